@@ -0,0 +1,63 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/errors"
+
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+var (
+	// ErrSMApplication indicates that the proposal has been applied but the
+	// state machine reported an application level error for it. The returned
+	// error is a *SMApplicationError.
+	ErrSMApplication = errors.New("state machine application error")
+)
+
+// SMApplicationError is the error returned by SyncPropose when the Update
+// method of the state machine set the Error field of the returned Result.
+// The proposal has been committed and applied on all replicas, Code and
+// Message are the ones provided by the state machine.
+type SMApplicationError struct {
+	ShardID uint64
+	Code    uint64
+	Message string
+}
+
+func (e *SMApplicationError) Error() string {
+	return fmt.Sprintf("%s, shard %d, code %d, message %s",
+		ErrSMApplication, e.ShardID, e.Code, e.Message)
+}
+
+// Unwrap returns ErrSMApplication.
+func (e *SMApplicationError) Unwrap() error {
+	return ErrSMApplication
+}
+
+// getApplicationError returns the *SMApplicationError of the result, nil is
+// returned when the state machine didn't report any error.
+func getApplicationError(shardID uint64, result sm.Result) error {
+	if result.Error == nil {
+		return nil
+	}
+	return &SMApplicationError{
+		ShardID: shardID,
+		Code:    result.Error.Code,
+		Message: result.Error.Message,
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// appErrorTestSM counts applied entries, entries with the "fail" command are
+// reported as application errors with the count as the error code.
+type appErrorTestSM struct {
+	count uint64
+}
+
+func newAppErrorTestSM(uint64, uint64) sm.IStateMachine {
+	return &appErrorTestSM{}
+}
+
+func (s *appErrorTestSM) Update(e sm.Entry) (sm.Result, error) {
+	s.count++
+	result := sm.Result{Value: s.count}
+	if string(e.Cmd) == "fail" {
+		result.Error = &sm.ApplicationError{Code: s.count, Message: "failed"}
+	}
+	return result, nil
+}
+
+func (s *appErrorTestSM) Lookup(key interface{}) (interface{}, error) {
+	return s.count, nil
+}
+
+func (s *appErrorTestSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	return json.NewEncoder(w).Encode(s.count)
+}
+
+func (s *appErrorTestSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	return json.NewDecoder(r).Decode(&s.count)
+}
+
+func (s *appErrorTestSM) Close() error { return nil }
+
+func TestSMApplicationErrorIsReturnedToProposer(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := make(map[uint64]Target)
+		for i := range nhs {
+			members[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		for i, nh := range nhs {
+			cfg := getBootstrapTestConfig(uint64(i + 1))
+			cfg.ShardID = 1
+			if err := nh.StartReplica(members,
+				false, newAppErrorTestSM, cfg); err != nil {
+				t.Fatalf("failed to start replica %v", err)
+			}
+		}
+		for _, nh := range nhs {
+			waitForLeaderToBeElected(t, nh, 1)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(nhs[0]))
+		defer cancel()
+		propose := func(nh *NodeHost,
+			cs *client.Session, cmd string) (sm.Result, *SMApplicationError) {
+			result, err := nh.SyncPropose(ctx, cs, []byte(cmd))
+			if err == nil {
+				return result, nil
+			}
+			var ae *SMApplicationError
+			if !errors.As(err, &ae) || !errors.Is(err, ErrSMApplication) {
+				t.Fatalf("failed to propose %v", err)
+			}
+			return result, ae
+		}
+		cs, err := nhs[0].SyncGetSession(ctx, 1)
+		if err != nil {
+			t.Fatalf("failed to get session %v", err)
+		}
+		result, ae := propose(nhs[0], cs, "fail")
+		if ae == nil || ae.ShardID != 1 || ae.Code != 1 || ae.Message != "failed" {
+			t.Fatalf("unexpected application error %v", ae)
+		}
+		if result.Value != 1 || result.Error == nil {
+			t.Errorf("unexpected result %+v", result)
+		}
+		// retried proposals are completed using the results cached in the
+		// client sessions of the replicas
+		for _, nh := range nhs {
+			result, ae := propose(nh, cs, "fail")
+			if ae == nil || ae.Code != 1 || result.Value != 1 {
+				t.Errorf("unexpected retried result %+v, %v", result, ae)
+			}
+		}
+		for _, nh := range nhs {
+			v, err := nh.SyncRead(ctx, 1, nil)
+			if err != nil {
+				t.Fatalf("failed to read %v", err)
+			}
+			if v.(uint64) != 1 {
+				t.Errorf("retried proposal applied again, count %d", v)
+			}
+		}
+		cs.ProposalCompleted()
+		if result, ae := propose(nhs[1], cs, "ok"); ae != nil || result.Value != 2 {
+			t.Errorf("unexpected result %+v, %v", result, ae)
+		}
+		noop := nhs[2].GetNoOPSession(1)
+		if result, ae := propose(nhs[2], noop, "fail"); ae == nil || ae.Code != 3 ||
+			result.Value != 3 {
+			t.Errorf("unexpected result %+v, %v", result, ae)
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
@@ -0,0 +1,370 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sort"
+	"sync"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// flags set in the Commit field of SnapshotDelegateResp messages, a response
+// with neither flag set reports the outcome of the delegated transfer.
+const (
+	delegateDeclined uint64 = 1 << iota
+	delegateAccepted
+)
+
+type delegationKey struct {
+	shardID   uint64
+	replicaID uint64
+}
+
+// snapshotDelegation is a snapshot transfer delegated by a local leader to a
+// follower as specified by config.Config.FollowerAssistedSnapshots.
+type snapshotDelegation struct {
+	helper uint64
+	// msg is the InstallSnapshot message the leader would have sent itself.
+	msg pb.Message
+	// deadline is the tick by which the helper must accept the delegation.
+	deadline uint64
+	accepted bool
+}
+
+// snapshotDelegations tracks snapshot transfers delegated to followers by local
+// leaders and transfers performed by local followers on behalf of leaders.
+type snapshotDelegations struct {
+	mu      sync.Mutex
+	tick    uint64
+	pending map[delegationKey]snapshotDelegation
+	// last is the last helper selected for each shard, helpers are selected in
+	// a round robin manner to spread concurrent transfers.
+	last map[uint64]uint64
+	// assisting is the leader of each transfer performed by local followers.
+	assisting map[delegationKey]uint64
+}
+
+func (d *snapshotDelegations) add(key delegationKey,
+	helper uint64, msg pb.Message, timeout uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending == nil {
+		d.pending = make(map[delegationKey]snapshotDelegation)
+		d.last = make(map[uint64]uint64)
+	}
+	d.pending[key] = snapshotDelegation{
+		helper:   helper,
+		msg:      msg,
+		deadline: d.tick + timeout,
+	}
+	d.last[key.shardID] = helper
+}
+
+// selectHelper returns the helper to be used among the specified candidates,
+// helpers with pending delegations are skipped. 0 is returned when no helper
+// is available.
+func (d *snapshotDelegations) selectHelper(shardID uint64,
+	candidates []uint64) uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	busy := make(map[uint64]struct{})
+	for key, v := range d.pending {
+		if key.shardID == shardID {
+			busy[v.helper] = struct{}{}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i] < candidates[j]
+	})
+	selected := uint64(0)
+	for _, c := range candidates {
+		if _, ok := busy[c]; ok {
+			continue
+		}
+		if selected == 0 {
+			selected = c
+		}
+		if c > d.last[shardID] {
+			return c
+		}
+	}
+	return selected
+}
+
+// accept marks the delegation as accepted by the helper, accepted delegations
+// no longer time out.
+func (d *snapshotDelegations) accept(key delegationKey, helper uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if v, ok := d.pending[key]; ok && v.helper == helper {
+		v.accepted = true
+		d.pending[key] = v
+	}
+}
+
+func (d *snapshotDelegations) remove(key delegationKey,
+	helper uint64) (snapshotDelegation, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok := d.pending[key]
+	if !ok || v.helper != helper {
+		return snapshotDelegation{}, false
+	}
+	delete(d.pending, key)
+	return v, true
+}
+
+// removeHelper removes all delegations of the shard assigned to the specified
+// helper.
+func (d *snapshotDelegations) removeHelper(shardID uint64,
+	helper uint64) []snapshotDelegation {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var result []snapshotDelegation
+	for key, v := range d.pending {
+		if key.shardID == shardID && v.helper == helper {
+			result = append(result, v)
+			delete(d.pending, key)
+		}
+	}
+	return result
+}
+
+// expire advances the tick and removes delegations not accepted in time. It
+// is invoked on each NodeHost tick.
+func (d *snapshotDelegations) expire() []snapshotDelegation {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tick++
+	var result []snapshotDelegation
+	for key, v := range d.pending {
+		if !v.accepted && d.tick > v.deadline {
+			result = append(result, v)
+			delete(d.pending, key)
+		}
+	}
+	return result
+}
+
+func (d *snapshotDelegations) assist(key delegationKey, leaderID uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.assisting == nil {
+		d.assisting = make(map[delegationKey]uint64)
+	}
+	for k := range d.assisting {
+		if k.shardID == key.shardID {
+			return false
+		}
+	}
+	d.assisting[key] = leaderID
+	return true
+}
+
+func (d *snapshotDelegations) assisted(key delegationKey) (uint64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	leaderID, ok := d.assisting[key]
+	delete(d.assisting, key)
+	return leaderID, ok
+}
+
+// delegateSnapshot asks a caught-up follower to send its own snapshot to the
+// target of the specified InstallSnapshot message. It returns a boolean value
+// indicating whether the transfer has been delegated, the leader is expected
+// to send the snapshot itself when it is not.
+func (nh *NodeHost) delegateSnapshot(n *node, msg pb.Message) bool {
+	if !n.config.FollowerAssistedSnapshots || n.OnDiskStateMachine() {
+		return false
+	}
+	addr, _, err := nh.nodes.Resolve(msg.ShardID, msg.To)
+	if err != nil {
+		return false
+	}
+	n.raftMu.Lock()
+	st := n.p.GetStatus()
+	n.raftMu.Unlock()
+	if st.LeaderID != n.replicaID {
+		return false
+	}
+	var candidates []uint64
+	for _, r := range st.Remotes {
+		if r.ReplicaID == msg.To || r.Match < msg.Snapshot.Index ||
+			n.isWitnessReplica(r.ReplicaID) {
+			continue
+		}
+		if r.LastActive == 0 || st.TickCount-r.LastActive > n.config.ElectionRTT {
+			continue
+		}
+		// followers running older versions of dragonboat can't handle
+		// delegated transfers
+		if !n.peerSupports(r.ReplicaID, pb.ProtocolVersion) {
+			continue
+		}
+		candidates = append(candidates, r.ReplicaID)
+	}
+	helper := nh.delegations.selectHelper(msg.ShardID, candidates)
+	if helper == 0 {
+		return false
+	}
+	key := delegationKey{shardID: msg.ShardID, replicaID: msg.To}
+	nh.delegations.add(key, helper, msg, n.config.ElectionRTT)
+	sent := nh.transport.Send(pb.Message{
+		Type:          pb.SnapshotDelegate,
+		ShardID:       msg.ShardID,
+		From:          n.replicaID,
+		To:            helper,
+		Hint:          msg.To,
+		LogIndex:      msg.Snapshot.Index,
+		LogTerm:       msg.Term,
+		BootstrapHash: msg.BootstrapHash,
+		Snapshot:      pb.Snapshot{Filepath: addr},
+	})
+	if !sent {
+		nh.delegations.remove(key, helper)
+		return false
+	}
+	plog.Infof("%s delegated snapshot %d for %s to %s", n.id(),
+		msg.Snapshot.Index, dn(msg.ShardID, msg.To), dn(msg.ShardID, helper))
+	return true
+}
+
+// handleSnapshotDelegate sends the local snapshot to the target specified by
+// the leader when the snapshot is recent enough, the request is declined
+// otherwise.
+func (nh *NodeHost) handleSnapshotDelegate(n *node, m pb.Message) {
+	resp := pb.Message{
+		Type:    pb.SnapshotDelegateResp,
+		ShardID: n.shardID,
+		From:    n.replicaID,
+		To:      m.From,
+		Hint:    m.Hint,
+		Commit:  delegateDeclined,
+	}
+	ss := n.logReader.Snapshot()
+	empty := pb.IsEmptySnapshot(ss)
+	key := delegationKey{shardID: n.shardID, replicaID: m.Hint}
+	if empty || ss.Index < m.LogIndex || ss.Dummy || ss.Witness ||
+		n.OnDiskStateMachine() || n.isWitness() ||
+		!nh.delegations.assist(key, m.From) {
+		if !empty {
+			if err := ss.Unref(); err != nil {
+				panicNow(err)
+			}
+		}
+		plog.Infof("%s declined to send snapshot to %s, required index %d",
+			n.id(), dn(n.shardID, m.Hint), m.LogIndex)
+		nh.transport.Send(resp)
+		return
+	}
+	if _, _, err := nh.nodes.Resolve(n.shardID, m.Hint); err != nil &&
+		len(m.Snapshot.Filepath) > 0 {
+		// the membership change adding the target is not applied yet
+		nh.nodes.Add(n.shardID, m.Hint, m.Snapshot.Filepath)
+	}
+	resp.Commit = delegateAccepted
+	nh.transport.Send(resp)
+	plog.Infof("%s is sending snapshot %d to %s on behalf of %s", n.id(),
+		ss.Index, dn(n.shardID, m.Hint), dn(n.shardID, m.From))
+	// the message is sent as if it is from the leader so the target reports
+	// back to the leader
+	nh.transport.SendSnapshot(pb.Message{
+		Type:          pb.InstallSnapshot,
+		ShardID:       n.shardID,
+		From:          m.From,
+		To:            m.Hint,
+		Term:          m.LogTerm,
+		BootstrapHash: m.BootstrapHash,
+		Snapshot:      ss,
+	})
+}
+
+// snapshotAssisted reports the outcome of a transfer performed by a local
+// follower to the leader. It returns a boolean value indicating whether the
+// transfer was performed on behalf of a leader.
+func (nh *NodeHost) snapshotAssisted(shardID uint64,
+	replicaID uint64, failed bool) bool {
+	key := delegationKey{shardID: shardID, replicaID: replicaID}
+	leaderID, ok := nh.delegations.assisted(key)
+	if !ok {
+		return false
+	}
+	if n, ok := nh.getShard(shardID); ok {
+		nh.transport.Send(pb.Message{
+			Type:    pb.SnapshotDelegateResp,
+			ShardID: shardID,
+			From:    n.replicaID,
+			To:      leaderID,
+			Hint:    replicaID,
+			Reject:  failed,
+		})
+	}
+	return true
+}
+
+// handleSnapshotDelegateResp handles the response of a delegated transfer on
+// the leader.
+func (nh *NodeHost) handleSnapshotDelegateResp(m pb.Message) {
+	key := delegationKey{shardID: m.ShardID, replicaID: m.Hint}
+	if m.Commit&delegateAccepted != 0 {
+		nh.delegations.accept(key, m.From)
+		return
+	}
+	d, ok := nh.delegations.remove(key, m.From)
+	if !ok {
+		return
+	}
+	if m.Commit&delegateDeclined != 0 {
+		nh.sendDelegatedSnapshot(d)
+		return
+	}
+	nh.completeDelegation(d, m.Reject)
+}
+
+// delegationsUnreachable handles delegations of a helper that became
+// unreachable. Delegations not yet accepted are sent by the leader, others are
+// reported as failed.
+func (nh *NodeHost) delegationsUnreachable(shardID uint64, replicaID uint64) {
+	for _, d := range nh.delegations.removeHelper(shardID, replicaID) {
+		if d.accepted {
+			nh.completeDelegation(d, true)
+		} else {
+			nh.sendDelegatedSnapshot(d)
+		}
+	}
+}
+
+// expireDelegations makes the leader to send snapshots for delegations that
+// are not accepted in time.
+func (nh *NodeHost) expireDelegations() {
+	for _, d := range nh.delegations.expire() {
+		nh.sendDelegatedSnapshot(d)
+	}
+}
+
+func (nh *NodeHost) sendDelegatedSnapshot(d snapshotDelegation) {
+	plog.Infof("%s is sending snapshot %d to %s, not sent by %s",
+		dn(d.msg.ShardID, d.msg.From), d.msg.Snapshot.Index,
+		dn(d.msg.ShardID, d.msg.To), dn(d.msg.ShardID, d.helper))
+	nh.transport.SendSnapshot(d.msg)
+}
+
+func (nh *NodeHost) completeDelegation(d snapshotDelegation, failed bool) {
+	if err := d.msg.Snapshot.Unref(); err != nil {
+		panicNow(err)
+	}
+	nh.msgHandler.HandleSnapshotStatus(d.msg.ShardID, d.msg.To, failed)
+}
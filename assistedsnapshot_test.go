@@ -0,0 +1,237 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/transport"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func getAssistedSnapshotTestConfig(replicaID uint64) config.Config {
+	return config.Config{
+		ShardID:                   1,
+		ReplicaID:                 replicaID,
+		ElectionRTT:               10,
+		HeartbeatRTT:              1,
+		CheckQuorum:               true,
+		CompactionOverhead:        5,
+		FollowerAssistedSnapshots: true,
+	}
+}
+
+// startAssistedSnapshotTestShard starts a three replicas shard on the first
+// three NodeHosts, snapshots are created on the leader and optionally on all
+// followers. The index of the NodeHost of the leader and the snapshot index of
+// the leader are returned.
+func startAssistedSnapshotTestShard(t *testing.T,
+	nhs []*NodeHost, followerSnapshots bool) (int, uint64) {
+	peers := make(map[uint64]string)
+	for i := 0; i < 3; i++ {
+		peers[uint64(i+1)] = memtransport.Address(i + 1)
+	}
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &PST{}
+	}
+	for i := 0; i < 3; i++ {
+		rc := getAssistedSnapshotTestConfig(uint64(i + 1))
+		if err := nhs[i].StartReplica(peers, false, createSM, rc); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		waitForLeaderToBeElected(t, nhs[i], 1)
+	}
+	leaderID, _, _, err := nhs[0].GetLeaderID(1)
+	if err != nil {
+		t.Fatalf("failed to get leader id %v", err)
+	}
+	leader := int(leaderID - 1)
+	for i := 0; i < 20; i++ {
+		if !makeTestProposal(nhs[leader], 100) {
+			t.Fatalf("failed to make proposal")
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[leader]))
+	defer cancel()
+	index, err := nhs[leader].SyncRequestSnapshot(ctx, 1, SnapshotOption{})
+	if err != nil {
+		t.Fatalf("failed to request snapshot %v", err)
+	}
+	if !followerSnapshots {
+		return leader, index
+	}
+	for i := 0; i < 3; i++ {
+		if i == leader {
+			continue
+		}
+		// the linearizable read makes sure the follower applied all entries
+		// covered by the snapshot of the leader
+		if _, err := nhs[i].SyncRead(ctx, 1, nil); err != nil {
+			t.Fatalf("failed to read %v", err)
+		}
+		if _, err := nhs[i].SyncRequestSnapshot(ctx,
+			1, SnapshotOption{}); err != nil {
+			t.Fatalf("failed to request snapshot %v", err)
+		}
+	}
+	return leader, index
+}
+
+// snapshotSources records NodeHosts that streamed snapshot chunks to each
+// replica.
+type snapshotSources struct {
+	mu      sync.Mutex
+	sources map[uint64]map[int]struct{}
+}
+
+func recordSnapshotSources(nhs []*NodeHost) *snapshotSources {
+	s := &snapshotSources{sources: make(map[uint64]map[int]struct{})}
+	for i := 0; i < 3; i++ {
+		i := i
+		tt := nhs[i].transport.(*transport.Transport)
+		tt.SetPreStreamChunkSendHook(func(c pb.Chunk) (pb.Chunk, bool) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.sources[c.ReplicaID] == nil {
+				s.sources[c.ReplicaID] = make(map[int]struct{})
+			}
+			s.sources[c.ReplicaID][i] = struct{}{}
+			return c, true
+		})
+	}
+	return s
+}
+
+// get returns the index of the NodeHost that streamed snapshot chunks to the
+// specified replica, it fails the test when there is no such NodeHost or when
+// there is more than one.
+func (s *snapshotSources) get(t *testing.T, replicaID uint64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sources[replicaID]) != 1 {
+		t.Fatalf("unexpected sources of replica %d, %v",
+			replicaID, s.sources[replicaID])
+	}
+	for i := range s.sources[replicaID] {
+		return i
+	}
+	return -1
+}
+
+// joinAssistedSnapshotTestReplicas adds replicas 4 and 5 to the shard and
+// waits for them to be recovered from snapshots.
+func joinAssistedSnapshotTestReplicas(t *testing.T,
+	nhs []*NodeHost, leader int, index uint64) {
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &PST{}
+	}
+	for _, replicaID := range []uint64{4, 5} {
+		rc := getAssistedSnapshotTestConfig(replicaID)
+		nh := nhs[replicaID-1]
+		if err := nh.StartReplica(nil, true, createSM, rc); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+	}
+	for _, replicaID := range []uint64{4, 5} {
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[leader]))
+		err := nhs[leader].SyncRequestAddReplica(ctx,
+			1, replicaID, memtransport.Address(int(replicaID)), 0)
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to add replica %v", err)
+		}
+	}
+	for _, replicaID := range []uint64{4, 5} {
+		nh := nhs[replicaID-1]
+		for i := 0; ; i++ {
+			ss, err := nh.mu.logdb.GetSnapshot(1, replicaID)
+			if err != nil {
+				t.Fatalf("failed to get snapshot %v", err)
+			}
+			if ss.Index >= index {
+				break
+			}
+			if i > 200 {
+				t.Fatalf("replica %d not recovered from snapshot", replicaID)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+func TestJoiningReplicasAreSentSnapshotsByDistinctFollowers(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		leader, index := startAssistedSnapshotTestShard(t, nhs, true)
+		sources := recordSnapshotSources(nhs)
+		joinAssistedSnapshotTestReplicas(t, nhs, leader, index)
+		s4 := sources.get(t, 4)
+		s5 := sources.get(t, 5)
+		if s4 == leader || s5 == leader {
+			t.Errorf("snapshot sent by the leader, %d, %d", s4, s5)
+		}
+		if s4 == s5 {
+			t.Errorf("snapshots sent by the same follower %d", s4)
+		}
+	}
+	memTransportNodeHostTest(t, 5, tf, fs)
+}
+
+func TestLeaderSendsSnapshotWhenFollowersDecline(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		leader, index := startAssistedSnapshotTestShard(t, nhs, false)
+		sources := recordSnapshotSources(nhs)
+		joinAssistedSnapshotTestReplicas(t, nhs, leader, index)
+		if s := sources.get(t, 4); s != leader {
+			t.Errorf("snapshot sent by %d, leader %d", s, leader)
+		}
+		if s := sources.get(t, 5); s != leader {
+			t.Errorf("snapshot sent by %d, leader %d", s, leader)
+		}
+	}
+	memTransportNodeHostTest(t, 5, tf, fs)
+}
+
+func TestSnapshotsAreNotDelegatedToFollowersPredatingDelegation(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		leader, index := startAssistedSnapshotTestShard(t, nhs, true)
+		for i := range nhs {
+			if i != leader {
+				predateProtocolVersion(nhs[i])
+			}
+		}
+		time.Sleep(500 * time.Millisecond)
+		sources := recordSnapshotSources(nhs)
+		joinAssistedSnapshotTestReplicas(t, nhs, leader, index)
+		if s := sources.get(t, 4); s != leader {
+			t.Errorf("snapshot sent by %d, leader %d", s, leader)
+		}
+		if s := sources.get(t, 5); s != leader {
+			t.Errorf("snapshot sent by %d, leader %d", s, leader)
+		}
+	}
+	memTransportNodeHostTest(t, 5, tf, fs)
+}
@@ -0,0 +1,112 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lni/dragonboat/v4/raftio"
+)
+
+const (
+	// auditLogSize is the number of recent AuditEntry records kept in memory
+	// when config.NodeHostConfig.AdminAuditSink is not set.
+	auditLogSize = 1024
+)
+
+// AuditEntry is the record of an administrative operation executed through
+// the NodeHost.
+type AuditEntry = raftio.AuditEntry
+
+type auditTagKey struct{}
+
+// WithAuditTag returns a copy of the parent context with the specified caller
+// tag attached. The tag is included in the AuditEntry records of the
+// administrative operations invoked with the returned context.
+func WithAuditTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, auditTagKey{}, tag)
+}
+
+func getAuditTag(ctx context.Context) string {
+	if tag, ok := ctx.Value(auditTagKey{}).(string); ok {
+		return tag
+	}
+	return ""
+}
+
+type auditParams = map[string]interface{}
+
+// auditLog is a ring buffer of recent AuditEntry records.
+type auditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+	next    uint64
+}
+
+func newAuditLog(size int) *auditLog {
+	return &auditLog{entries: make([]AuditEntry, size)}
+}
+
+func (l *auditLog) add(e AuditEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next%uint64(len(l.entries))] = e
+	l.next++
+}
+
+// recent returns up to n most recent entries, oldest first.
+func (l *auditLog) recent(n int) []AuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	count := uint64(len(l.entries))
+	if l.next < count {
+		count = l.next
+	}
+	if n >= 0 && uint64(n) < count {
+		count = uint64(n)
+	}
+	result := make([]AuditEntry, 0, count)
+	for i := l.next - count; i < l.next; i++ {
+		result = append(result, l.entries[i%uint64(len(l.entries))])
+	}
+	return result
+}
+
+// audit completes the specified entry using the caller tag in ctx, the start
+// time and the result of the operation and passes it to the configured audit
+// sink, or to the in memory audit log when there is no such sink. It is
+// usually deferred by administrative NodeHost methods.
+func (nh *NodeHost) audit(ctx context.Context,
+	e AuditEntry, start time.Time, err *error) {
+	e.CallerTag = getAuditTag(ctx)
+	e.Time = start
+	e.Duration = time.Since(start)
+	e.Error = *err
+	if nh.nhConfig.AdminAuditSink != nil {
+		nh.nhConfig.AdminAuditSink(e)
+		return
+	}
+	nh.auditLog.add(e)
+}
+
+// RecentAdminOps returns up to n most recently completed administrative
+// operations, oldest first. All retained entries are returned when n is
+// negative. Nothing is retained when config.NodeHostConfig.AdminAuditSink is
+// set.
+func (nh *NodeHost) RecentAdminOps(n int) []AuditEntry {
+	return nh.auditLog.recent(n)
+}
@@ -0,0 +1,184 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+)
+
+func TestEverySyncAdminOperationIsAudited(t *testing.T) {
+	fs := vfs.GetTestFS()
+	var mu sync.Mutex
+	var entries []raftio.AuditEntry
+	to := &testOption{
+		defaultTestNode: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.AdminAuditSink = func(e raftio.AuditEntry) {
+				mu.Lock()
+				defer mu.Unlock()
+				entries = append(entries, e)
+			}
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			ctx = WithAuditTag(ctx, "alice")
+			// shard 2 doesn't exist, operations on it fail
+			tests := []struct {
+				op string
+				f  func() error
+				ok bool
+			}{
+				{"SyncRequestSnapshot", func() error {
+					_, err := nh.SyncRequestSnapshot(ctx, 1, SnapshotOption{})
+					return err
+				}, true},
+				{"SyncRequestAddNonVoting", func() error {
+					return nh.SyncRequestAddNonVoting(ctx, 1, 2, nodeHostTestAddr2, 0)
+				}, true},
+				{"SyncRequestDeleteReplica", func() error {
+					return nh.SyncRequestDeleteReplica(ctx, 1, 2, 0)
+				}, true},
+				{"SyncRequestForceDeleteReplica", func() error {
+					return nh.SyncRequestForceDeleteReplica(ctx, 2, 2, 0)
+				}, false},
+				{"SyncRequestAddReplica", func() error {
+					return nh.SyncRequestAddReplica(ctx, 2, 2, nodeHostTestAddr2, 0)
+				}, false},
+				{"SyncRequestAddReplicaStaged", func() error {
+					return nh.SyncRequestAddReplicaStaged(ctx, 2, 2, nodeHostTestAddr2, 0)
+				}, false},
+				{"SyncRequestReplaceReplica", func() error {
+					return nh.SyncRequestReplaceReplica(ctx, 2, 1, 2, nodeHostTestAddr2, 0)
+				}, false},
+				{"SyncRequestAddWitness", func() error {
+					return nh.SyncRequestAddWitness(ctx, 2, 2, nodeHostTestAddr2, 0)
+				}, false},
+				{"SyncRequestAddReplicaWithOption", func() error {
+					return nh.SyncRequestAddReplicaWithOption(ctx, 2, 2,
+						nodeHostTestAddr2, 0, AddReplicaOption{})
+				}, false},
+				{"SyncRequestAddNonVotingWithOption", func() error {
+					return nh.SyncRequestAddNonVotingWithOption(ctx, 2, 2,
+						nodeHostTestAddr2, 0, AddReplicaOption{})
+				}, false},
+				{"SyncRequestAddWitnessWithOption", func() error {
+					return nh.SyncRequestAddWitnessWithOption(ctx, 2, 2,
+						nodeHostTestAddr2, 0, AddReplicaOption{})
+				}, false},
+				{"SyncRequestPromoteWitness", func() error {
+					return nh.SyncRequestPromoteWitness(ctx, 2, 2, 0)
+				}, false},
+				{"SyncRequestReconfigure", func() error {
+					return nh.SyncRequestReconfigure(ctx, 2, Membership{}, 0)
+				}, false},
+				{"SyncRequestLeaderTransfer", func() error {
+					return nh.SyncRequestLeaderTransfer(ctx, 2, 1, LeaderTransferOption{})
+				}, false},
+				{"SyncRemoveData", func() error {
+					return nh.SyncRemoveData(ctx, 1, 1)
+				}, false},
+				{"SyncDecommissionLocalReplica", func() error {
+					return nh.SyncDecommissionLocalReplica(ctx, 2, DecommissionOption{})
+				}, false},
+				{"ActivateStandby", func() error {
+					return nh.ActivateStandby(ctx, 2)
+				}, false},
+			}
+			for _, tt := range tests {
+				mu.Lock()
+				entries = nil
+				mu.Unlock()
+				err := tt.f()
+				if (err == nil) != tt.ok {
+					t.Fatalf("%s, unexpected error %v", tt.op, err)
+				}
+				mu.Lock()
+				got := append([]raftio.AuditEntry{}, entries...)
+				mu.Unlock()
+				if len(got) != 1 {
+					t.Fatalf("%s, got %d entries, %+v", tt.op, len(got), got)
+				}
+				e := got[0]
+				if e.Operation != tt.op || e.CallerTag != "alice" ||
+					e.Time.IsZero() || e.Duration <= 0 || !errors.Is(e.Error, err) {
+					t.Errorf("%s, unexpected entry %+v", tt.op, e)
+				}
+				if tt.ok && e.ShardID != 1 {
+					t.Errorf("%s, unexpected shard ID %d", tt.op, e.ShardID)
+				}
+			}
+			if ops := nh.RecentAdminOps(-1); len(ops) != 0 {
+				t.Errorf("entries unexpectedly retained, %+v", ops)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestRecentAdminOpsAreRetainedWithoutSink(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			if _, err := nh.RequestCompaction(1, 2); err != ErrShardNotFound {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err := nh.RequestLeaderTransfer(2, 1); err != ErrShardNotFound {
+				t.Fatalf("unexpected error %v", err)
+			}
+			ops := nh.RecentAdminOps(10)
+			if len(ops) != 2 ||
+				ops[0].Operation != "RequestCompaction" ||
+				ops[1].Operation != "RequestLeaderTransfer" ||
+				ops[1].Error != ErrShardNotFound || ops[1].CallerTag != "" ||
+				ops[1].Parameters["TargetReplicaID"] != uint64(1) {
+				t.Errorf("unexpected ops %+v", ops)
+			}
+			if ops := nh.RecentAdminOps(1); len(ops) != 1 ||
+				ops[0].Operation != "RequestLeaderTransfer" {
+				t.Errorf("unexpected ops %+v", ops)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestAuditLogKeepsMostRecentEntries(t *testing.T) {
+	l := newAuditLog(3)
+	if len(l.recent(-1)) != 0 {
+		t.Fatalf("unexpected entries")
+	}
+	for i := uint64(1); i <= 5; i++ {
+		l.add(AuditEntry{ShardID: i})
+	}
+	entries := l.recent(-1)
+	if len(entries) != 3 || entries[0].ShardID != 3 || entries[2].ShardID != 5 {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+	entries = l.recent(2)
+	if len(entries) != 2 || entries[0].ShardID != 4 || entries[1].ShardID != 5 {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+}
@@ -0,0 +1,419 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"io"
+	"path"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/backup"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	// maxBackupAttempts is the max number of attempts made to back up a
+	// replica whose snapshot or log entries are concurrently compacted.
+	maxBackupAttempts = 3
+	// backupBatchSize is the max size of entries read from the LogDB in a
+	// single batch when backing up a replica.
+	backupBatchSize = 64 * 1024 * 1024
+)
+
+// errBackupOutOfDate indicates that the state of the replica changed while it
+// was being backed up, the backup of the replica should be retried.
+var errBackupOutOfDate = errors.New("replica state changed during backup")
+
+// BackupSink is the destination of a NodeHost backup, it allows backups to be
+// directly written to places such as object stores. Files are created using
+// their slash separated paths relative to the backup root, the MANIFEST file
+// describing the backup is always the last file created. Methods of the
+// BackupSink are invoked from the goroutine calling NodeHost.Backup or from a
+// snapshot worker goroutine, never concurrently.
+type BackupSink interface {
+	// CreateFile creates the named file, each file is closed before the next
+	// one is created.
+	CreateFile(name string) (io.WriteCloser, error)
+	// Commit is invoked once all files have been written and closed. The
+	// backup is expected to be made visible atomically by Commit.
+	Commit() error
+	// Abort is invoked when the backup fails, including when Commit returns
+	// an error. Files already created should be discarded.
+	Abort()
+}
+
+// dirBackupSink is a BackupSink that writes the backup to a local directory.
+type dirBackupSink struct {
+	sink *dirExportSink
+}
+
+var _ BackupSink = (*dirBackupSink)(nil)
+
+// NewDirBackupSink returns a BackupSink that writes the backup to the specified
+// existing directory, the directory is expected to be empty. Files are written
+// to a temporary directory first and are moved into place on Commit. The
+// default filesystem is used when fs is nil. Such a backup can be restored by
+// passing the directory to the RestoreNodeHost function in the tools package.
+func NewDirBackupSink(dir string, fs config.IFS) BackupSink {
+	if fs == nil {
+		fs = vfs.DefaultFS
+	}
+	return &dirBackupSink{sink: &dirExportSink{dir: dir, fs: fs}}
+}
+
+// CreateFile creates the named file in the temporary directory.
+func (s *dirBackupSink) CreateFile(name string) (io.WriteCloser, error) {
+	return s.sink.CreateFile(name)
+}
+
+// Commit moves backup files from the temporary directory to the backup
+// directory.
+func (s *dirBackupSink) Commit() error {
+	return s.sink.Commit(pb.Snapshot{})
+}
+
+// Abort removes the temporary directory.
+func (s *dirBackupSink) Abort() {
+	s.sink.Abort()
+}
+
+// BackupOptions is the option type used by NodeHost.Backup.
+type BackupOptions struct {
+	// EnsureSnapshot indicates that a snapshot should be exported for replicas
+	// that have not taken any snapshot yet, their backups would otherwise
+	// consist of their complete Raft logs.
+	EnsureSnapshot bool
+}
+
+// Backup writes a backup of all replicas currently running on the NodeHost to
+// sink. For each replica, its latest snapshot, its Raft state, Raft log
+// entries after the snapshot and its bootstrap record are captured, the
+// backup of each replica is a consistent point-in-time view of the replica
+// while different replicas are captured at different times. Replicas are
+// backed up one by one, ongoing proposals and reads are not blocked. Replicas
+// managing on disk state machines or those without any snapshot when
+// opts.EnsureSnapshot is set will have a snapshot exported to sink, which
+// invokes their state machines' snapshot methods. Replicas stopped during the
+// backup are skipped.
+//
+// The context must have a deadline, it is used by each export request and
+// is checked between replicas. Sink is committed once all replicas have been
+// written, it is aborted when Backup fails. The NodeHost directory can be
+// reconstructed from the backup using the RestoreNodeHost function in the
+// tools package.
+func (nh *NodeHost) Backup(ctx context.Context,
+	sink BackupSink, opts BackupOptions) (err error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	if _, err := getTimeoutFromContext(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			sink.Abort()
+		}
+	}()
+	var nodes []*node
+	nh.forEachShard(func(_ uint64, n *node) bool {
+		nodes = append(nodes, n)
+		return true
+	})
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].shardID < nodes[j].shardID
+	})
+	m := backup.Manifest{
+		NodeHostID:   nh.ID(),
+		RaftAddress:  nh.RaftAddress(),
+		DeploymentID: nh.nhConfig.GetDeploymentID(),
+		Time:         time.Now().Unix(),
+	}
+	for _, n := range nodes {
+		if ctx.Err() != nil {
+			return getContextError(ctx)
+		}
+		r, err := nh.backupReplica(ctx, sink, n, opts)
+		if err != nil {
+			if errors.Is(err, ErrShardNotFound) ||
+				errors.Is(err, ErrShardClosed) {
+				plog.Warningf("%s stopped, skipped from backup",
+					dn(n.shardID, n.replicaID))
+				continue
+			}
+			return err
+		}
+		m.Replicas = append(m.Replicas, r)
+	}
+	data, err := backup.MarshalManifest(m)
+	if err != nil {
+		return err
+	}
+	f, err := sink.CreateFile(backup.ManifestFilename)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return firstError(err, f.Close())
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return sink.Commit()
+}
+
+func (nh *NodeHost) backupReplica(ctx context.Context,
+	sink BackupSink, n *node, opts BackupOptions) (backup.Replica, error) {
+	for i := 1; ; i++ {
+		r, err := nh.tryBackupReplica(ctx, sink, n, opts)
+		if errors.Is(err, errBackupOutOfDate) && i < maxBackupAttempts {
+			plog.Infof("%s changed during backup, retrying",
+				dn(n.shardID, n.replicaID))
+			continue
+		}
+		return r, err
+	}
+}
+
+func (nh *NodeHost) tryBackupReplica(ctx context.Context,
+	sink BackupSink, n *node, opts BackupOptions) (backup.Replica, error) {
+	shardID, replicaID := n.shardID, n.replicaID
+	ldb := nh.mu.logdb
+	bs, err := ldb.GetBootstrapInfo(shardID, replicaID)
+	if err != nil {
+		return backup.Replica{}, err
+	}
+	ss, err := ldb.GetSnapshot(shardID, replicaID)
+	if err != nil {
+		return backup.Replica{}, err
+	}
+	dir := backup.GetReplicaDir(shardID, replicaID)
+	var files []backup.File
+	if !ss.Witness &&
+		(ss.Dummy || (pb.IsEmptySnapshot(ss) && opts.EnsureSnapshot)) {
+		if ss, files, err = nh.exportForBackup(ctx, sink, dir, n); err != nil {
+			return backup.Replica{}, err
+		}
+	} else if !pb.IsEmptySnapshot(ss) && !ss.Witness {
+		if ss, files, err = nh.copyForBackup(sink, dir, ss); err != nil {
+			return backup.Replica{}, err
+		}
+	}
+	rs, err := ldb.ReadRaftState(shardID, replicaID, ss.Index)
+	if err != nil {
+		return backup.Replica{}, err
+	}
+	r := backup.Replica{
+		ShardID:       shardID,
+		ReplicaID:     replicaID,
+		Bootstrap:     pb.MustMarshal(&bs),
+		Snapshot:      pb.MustMarshal(&ss),
+		SnapshotFiles: files,
+		FirstIndex:    ss.Index + 1,
+		LastIndex:     ss.Index,
+	}
+	if rs.EntryCount > 0 {
+		r.LastIndex = rs.FirstIndex + rs.EntryCount - 1
+		if r.Entries, err = backupEntries(ldb, sink, r); err != nil {
+			return backup.Replica{}, err
+		}
+	}
+	// entries are only overwritten by a leader of a later term, the backup is
+	// consistent when the term and the vote observed before reading entries
+	// are still current
+	latest, err := ldb.ReadRaftState(shardID, replicaID, ss.Index)
+	if err != nil {
+		return backup.Replica{}, err
+	}
+	if latest.State.Term != rs.State.Term || latest.State.Vote != rs.State.Vote {
+		return backup.Replica{}, errBackupOutOfDate
+	}
+	if rs.State.Commit > r.LastIndex {
+		rs.State.Commit = r.LastIndex
+	}
+	r.State = pb.MustMarshal(&rs.State)
+	return r, nil
+}
+
+// copyForBackup copies files of the local snapshot ss to sink. The returned
+// snapshot record refers to files in the backup.
+func (nh *NodeHost) copyForBackup(sink BackupSink,
+	dir string, ss pb.Snapshot) (pb.Snapshot, []backup.File, error) {
+	ssDir := path.Join(dir, server.GetSnapshotDirName(ss.Index))
+	paths := []string{ss.Filepath}
+	for _, f := range ss.Files {
+		paths = append(paths, f.Filepath)
+	}
+	// all files are opened before copying any of them so they remain readable
+	// when the snapshot is concurrently removed as obsolete
+	var inputs []vfs.File
+	defer func() {
+		for i, f := range inputs {
+			if err := f.Close(); err != nil {
+				plog.Errorf("failed to close %s, %v", paths[i], err)
+			}
+		}
+	}()
+	for _, fp := range paths {
+		f, err := nh.fs.Open(fp)
+		if err != nil {
+			if vfs.IsNotExist(err) {
+				return pb.Snapshot{}, nil, errBackupOutOfDate
+			}
+			return pb.Snapshot{}, nil, err
+		}
+		inputs = append(inputs, f)
+	}
+	var files []backup.File
+	for i, fp := range paths {
+		name := path.Join(ssDir, nh.fs.PathBase(fp))
+		file, err := copyToBackup(sink, name, inputs[i])
+		if err != nil {
+			return pb.Snapshot{}, nil, err
+		}
+		files = append(files, file)
+	}
+	ss.Filepath = files[0].Name
+	ss.Files = append([]*pb.SnapshotFile(nil), ss.Files...)
+	for i, f := range ss.Files {
+		cf := *f
+		cf.Filepath = files[i+1].Name
+		ss.Files[i] = &cf
+	}
+	return ss, files, nil
+}
+
+func copyToBackup(sink BackupSink,
+	name string, r io.Reader) (backup.File, error) {
+	f, err := sink.CreateFile(name)
+	if err != nil {
+		return backup.File{}, err
+	}
+	w := backup.NewWriter(name, f)
+	if _, err := io.Copy(w, r); err != nil {
+		return backup.File{}, firstError(err, w.Close())
+	}
+	if err := w.Close(); err != nil {
+		return backup.File{}, err
+	}
+	return w.File(), nil
+}
+
+// exportForBackup requests a snapshot of the replica to be exported to sink.
+// The returned snapshot record refers to files in the backup.
+func (nh *NodeHost) exportForBackup(ctx context.Context, sink BackupSink,
+	dir string, n *node) (pb.Snapshot, []backup.File, error) {
+	es := &backupExportSink{sink: sink, dir: dir}
+	opt := SnapshotOption{Exported: true, ExportSink: es}
+	if _, err := nh.SyncRequestSnapshot(ctx, n.shardID, opt); err != nil {
+		return pb.Snapshot{}, nil, err
+	}
+	ss := es.meta
+	var files []backup.File
+	ss.Filepath = path.Join(dir, ss.Filepath)
+	files = append(files, es.files[ss.Filepath])
+	ss.Files = append([]*pb.SnapshotFile(nil), ss.Files...)
+	for i, f := range ss.Files {
+		cf := *f
+		cf.Filepath = path.Join(dir, f.Filepath)
+		ss.Files[i] = &cf
+		files = append(files, es.files[cf.Filepath])
+	}
+	return ss, files, nil
+}
+
+// backupExportSink is the ExportSink used for writing exported snapshots to
+// the BackupSink, all files are written to the directory of the replica.
+type backupExportSink struct {
+	sink  BackupSink
+	dir   string
+	files map[string]backup.File
+	meta  pb.Snapshot
+}
+
+var _ ExportSink = (*backupExportSink)(nil)
+
+func (s *backupExportSink) CreateFile(name string) (io.WriteCloser, error) {
+	name = path.Join(s.dir, name)
+	f, err := s.sink.CreateFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &backupExportFile{Writer: backup.NewWriter(name, f), sink: s}, nil
+}
+
+func (s *backupExportSink) Commit(meta pb.Snapshot) error {
+	s.meta = meta
+	return nil
+}
+
+// Abort is a no-op, the backup is aborted as a whole when the export fails.
+func (s *backupExportSink) Abort() {}
+
+type backupExportFile struct {
+	*backup.Writer
+	sink *backupExportSink
+}
+
+func (f *backupExportFile) Close() error {
+	if err := f.Writer.Close(); err != nil {
+		return err
+	}
+	if f.sink.files == nil {
+		f.sink.files = make(map[string]backup.File)
+	}
+	file := f.Writer.File()
+	f.sink.files[file.Name] = file
+	return nil
+}
+
+// backupEntries writes entries between r.FirstIndex and r.LastIndex to sink.
+func backupEntries(ldb raftio.ILogDB,
+	sink BackupSink, r backup.Replica) (backup.File, error) {
+	name := backup.GetEntriesFilename(r.ShardID, r.ReplicaID)
+	f, err := sink.CreateFile(name)
+	if err != nil {
+		return backup.File{}, err
+	}
+	w := backup.NewWriter(name, f)
+	var entries []pb.Entry
+	for low := r.FirstIndex; low <= r.LastIndex; {
+		entries, _, err = ldb.IterateEntries(entries[:0], 0,
+			r.ShardID, r.ReplicaID, low, r.LastIndex+1, backupBatchSize)
+		if err == nil && (len(entries) == 0 || entries[0].Index != low) {
+			// compacted after the snapshot was read
+			err = errBackupOutOfDate
+		}
+		if err == nil {
+			err = backup.WriteEntries(w, entries)
+		}
+		if err != nil {
+			return backup.File{}, firstError(err, w.Close())
+		}
+		low = entries[len(entries)-1].Index + 1
+	}
+	if err := w.Close(); err != nil {
+		return backup.File{}, err
+	}
+	return w.File(), nil
+}
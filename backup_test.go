@@ -0,0 +1,214 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/backup"
+	"github.com/lni/dragonboat/v4/internal/tests"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+	"github.com/lni/dragonboat/v4/tools"
+)
+
+func startBackupTestOnDiskShard(t *testing.T,
+	nh *NodeHost, initialMembers map[uint64]string, applied uint64) {
+	rc := config.Config{
+		ShardID:      3,
+		ReplicaID:    1,
+		ElectionRTT:  10,
+		HeartbeatRTT: 1,
+		CheckQuorum:  true,
+	}
+	newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
+		return tests.NewSimDiskSM(applied)
+	}
+	if err := nh.StartOnDiskReplica(initialMembers, false, newSM, rc); err != nil {
+		t.Fatalf("failed to start replica %v", err)
+	}
+	waitForLeaderToBeElected(t, nh, 3)
+}
+
+func TestNodeHostCanBeBackedUpAndRestored(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		nh := nhs[0]
+		members := map[uint64]string{1: memtransport.Address(1)}
+		startCloneTestShard(t, nhs, 1, []uint64{1}, members)
+		startCloneTestShard(t, nhs, 2, []uint64{1}, members)
+		startBackupTestOnDiskShard(t, nh, members, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(nh))
+		defer cancel()
+		propose := func(shardID uint64, cmd string) {
+			if _, err := nh.SyncPropose(ctx,
+				nh.GetNoOPSession(shardID), []byte(cmd)); err != nil {
+				t.Fatalf("failed to propose %v", err)
+			}
+		}
+		propose(1, "a=1")
+		propose(1, "b=2")
+		if _, err := nh.SyncRequestSnapshot(ctx, 1, SnapshotOption{}); err != nil {
+			t.Fatalf("failed to request snapshot %v", err)
+		}
+		propose(1, "c=3")
+		propose(2, "x=1")
+		for i := 0; i < 8; i++ {
+			propose(3, "test-data")
+		}
+		rv, err := nh.SyncRead(ctx, 3, nil)
+		if err != nil {
+			t.Fatalf("failed to read %v", err)
+		}
+		applied := rv.(uint64)
+		// the NodeHost is loaded while being backed up
+		stopc := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stopc:
+					return
+				default:
+				}
+				pctx, pcancel := context.WithTimeout(context.Background(), pto(nh))
+				cmd := fmt.Sprintf("k%d=%d", i, i)
+				if _, err := nh.SyncPropose(pctx,
+					nh.GetNoOPSession(1), []byte(cmd)); err != nil {
+					t.Errorf("failed to propose %v", err)
+				}
+				pcancel()
+			}
+		}()
+		backupDir := fs.PathJoin(singleNodeHostTestDir, "backup")
+		if err := fs.MkdirAll(backupDir, 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+		sink := NewDirBackupSink(backupDir, fs)
+		err = nh.Backup(ctx, sink, BackupOptions{EnsureSnapshot: true})
+		close(stopc)
+		wg.Wait()
+		if err != nil {
+			t.Fatalf("failed to backup %v", err)
+		}
+		m, err := backup.GetManifest(tools.NewDirBackupSource(backupDir, fs))
+		if err != nil {
+			t.Fatalf("failed to get manifest %v", err)
+		}
+		if len(m.Replicas) != 3 || m.NodeHostID != nh.ID() {
+			t.Fatalf("unexpected manifest %+v", m)
+		}
+		for _, r := range m.Replicas {
+			var ss pb.Snapshot
+			if err := ss.Unmarshal(r.Snapshot); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if ss.Index == 0 || ss.Dummy || len(r.SnapshotFiles) == 0 {
+				t.Errorf("shard %d, unexpected snapshot %+v", r.ShardID, ss)
+			}
+		}
+		nhc := nh.NodeHostConfig()
+		nh.Close()
+		nhc.NodeHostDir = fs.PathJoin(singleNodeHostTestDir, "restored")
+		nhc.WALDir = ""
+		src := tools.NewDirBackupSource(backupDir, fs)
+		if err := tools.RestoreNodeHost(nhc, src); err != nil {
+			t.Fatalf("failed to restore %v", err)
+		}
+		if err := tools.RestoreNodeHost(nhc, src); !errors.Is(err,
+			tools.ErrNodeHostNotEmpty) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		rnh, err := NewNodeHost(nhc)
+		if err != nil {
+			t.Fatalf("failed to create nodehost %v", err)
+		}
+		// closed by memTransportNodeHostTest
+		nhs[0] = rnh
+		if rnh.ID() != m.NodeHostID {
+			t.Errorf("NodeHostID %s, want %s", rnh.ID(), m.NodeHostID)
+		}
+		startCloneTestShard(t, nhs, 1, []uint64{1}, nil)
+		startCloneTestShard(t, nhs, 2, []uint64{1}, nil)
+		startBackupTestOnDiskShard(t, rnh, nil, 0)
+		for key, want := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+			if v := readCloneTestValue(t, rnh, 1, key); v != want {
+				t.Errorf("key %s, value %s, want %s", key, v, want)
+			}
+		}
+		if v := readCloneTestValue(t, rnh, 2, "x"); v != "1" {
+			t.Errorf("unexpected value %s", v)
+		}
+		rctx, rcancel := context.WithTimeout(context.Background(), pto(rnh))
+		defer rcancel()
+		rv, err = rnh.SyncRead(rctx, 3, nil)
+		if err != nil {
+			t.Fatalf("failed to read %v", err)
+		}
+		if rv.(uint64) < applied {
+			t.Errorf("applied %d, want >= %d", rv.(uint64), applied)
+		}
+		// restored shards accept new proposals
+		if _, err := rnh.SyncPropose(rctx,
+			rnh.GetNoOPSession(1), []byte("d=4")); err != nil {
+			t.Fatalf("failed to propose %v", err)
+		}
+	}
+	memTransportNodeHostTest(t, 1, tf, fs)
+}
+
+func TestFailedBackupIsAborted(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			proposeTestData(t, nh, "backup", 5)
+			sink := &memBackupSink{memExportSink: newMemExportSink()}
+			sink.failOn = backup.ManifestFilename
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			if err := nh.Backup(ctx, sink, BackupOptions{}); err == nil {
+				t.Fatalf("backup unexpectedly completed")
+			}
+			if !sink.aborted || len(sink.committed) > 0 {
+				t.Errorf("backup not aborted, %+v", sink)
+			}
+			if err := nh.Backup(context.Background(),
+				sink, BackupOptions{}); !errors.Is(err, ErrDeadlineNotSet) {
+				t.Errorf("unexpected error %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+// memBackupSink is a BackupSink similar to an object store.
+type memBackupSink struct {
+	*memExportSink
+}
+
+func (s *memBackupSink) Commit() error {
+	return s.memExportSink.Commit(pb.Snapshot{})
+}
@@ -0,0 +1,248 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/barrier"
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+const (
+	// BarrierManifestFilename is the name of the manifest file written by
+	// SyncCoordinatedExport.
+	BarrierManifestFilename = barrier.ManifestFilename
+)
+
+// SyncBarrier proposes a barrier entry to the specified shard and returns the
+// index of the entry once it is applied by the local replica. The barrier
+// entry is not passed to the state machine, it orders the shard's Raft log -
+// all proposals completed before SyncBarrier is invoked have indexes lower
+// than the returned index, snapshots taken by the local replica after
+// SyncBarrier returns include all of them.
+//
+// The input context object must have deadline set.
+func (nh *NodeHost) SyncBarrier(ctx context.Context,
+	shardID uint64) (_ uint64, err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "SyncBarrier",
+		ShardID:   shardID,
+	}, time.Now(), &err)
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return 0, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return 0, nh.shardNotFound(shardID)
+	}
+	rs, err := n.proposeBarrier(nh.getTimeoutTick(timeout))
+	if err != nil {
+		return 0, err
+	}
+	nh.engine.setStepReady(shardID)
+	r, err := getRequestResult(ctx, rs)
+	if err != nil {
+		return 0, err
+	}
+	rs.Release()
+	return r.index, nil
+}
+
+// BarrierManifest ties together snapshots of multiple shards exported by
+// SyncCoordinatedExport, each snapshot includes everything up to the barrier
+// proposed to its shard. It is saved as JSON to the BarrierManifestFilename
+// file in the export directory.
+type BarrierManifest = barrier.Manifest
+
+// BarrierShard is the record of a shard in the BarrierManifest.
+type BarrierShard = barrier.Shard
+
+// ReadBarrierManifest reads the BarrierManifest saved in the specified export
+// directory. The default filesystem is used when fs is nil.
+func ReadBarrierManifest(dir string, fs config.IFS) (BarrierManifest, error) {
+	if fs == nil {
+		fs = vfs.DefaultFS
+	}
+	return barrier.Read(dir, fs)
+}
+
+// SyncCoordinatedExport exports mutually consistent snapshots of the specified
+// shards to dir, e.g. to back up a dataset sharded across multiple shards. A
+// barrier entry is proposed to each shard using SyncBarrier, snapshots at or
+// after the recorded barrier indexes are then exported by the local replicas
+// to the shard-N sub-directories of dir. All proposals completed before
+// SyncCoordinatedExport is invoked are included in the exported snapshots.
+// The local NodeHost must have a replica of each specified shard.
+//
+// Progress is recorded in the BarrierManifest saved in dir. When some shards
+// fail, the error is returned along with the partially completed manifest,
+// invoking SyncCoordinatedExport again with the same dir and shards resumes
+// the export, barriers already recorded are kept and exported snapshots are
+// not exported again. ErrInvalidOption is returned when dir contains the
+// manifest of a different set of shards. Use the ImportBarrierManifest
+// function in the tools package to import all exported snapshots.
+//
+// The input context object must have deadline set.
+func (nh *NodeHost) SyncCoordinatedExport(ctx context.Context,
+	dir string, shardIDs []uint64) (_ BarrierManifest, err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation:  "SyncCoordinatedExport",
+		Parameters: auditParams{"Dir": dir, "Shards": shardIDs},
+	}, time.Now(), &err)
+	if _, err := getTimeoutFromContext(ctx); err != nil {
+		return BarrierManifest{}, err
+	}
+	if len(shardIDs) == 0 {
+		return BarrierManifest{}, ErrInvalidOption
+	}
+	e := &coordinatedExport{nh: nh, dir: dir}
+	if err := e.load(shardIDs); err != nil {
+		return BarrierManifest{}, err
+	}
+	// barriers of all shards are recorded before any snapshot is exported
+	e.run(func(s *BarrierShard) error {
+		if s.BarrierIndex > 0 {
+			return nil
+		}
+		index, err := nh.SyncBarrier(ctx, s.ShardID)
+		if err != nil {
+			return err
+		}
+		s.BarrierIndex = index
+		return nil
+	})
+	e.run(func(s *BarrierShard) error {
+		if s.BarrierIndex == 0 || s.SnapshotIndex > 0 {
+			return nil
+		}
+		return e.export(ctx, s)
+	})
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.m, e.err
+}
+
+// coordinatedExport is a coordinated export in progress.
+type coordinatedExport struct {
+	nh  *NodeHost
+	dir string
+	mu  sync.Mutex
+	m   BarrierManifest
+	err error
+}
+
+func (e *coordinatedExport) load(shardIDs []uint64) error {
+	fs := e.nh.fs
+	if err := fileutil.MkdirAll(e.dir, fs); err != nil {
+		return err
+	}
+	m, err := ReadBarrierManifest(e.dir, fs)
+	if err != nil && !vfs.IsNotExist(err) {
+		return err
+	}
+	ids := append([]uint64{}, shardIDs...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(m.Shards) == 0 {
+		for _, shardID := range ids {
+			m.Shards = append(m.Shards, BarrierShard{ShardID: shardID})
+		}
+		e.m = m
+		return nil
+	}
+	if len(m.Shards) != len(ids) {
+		return errors.Wrapf(ErrInvalidOption,
+			"manifest in %s is for different shards", e.dir)
+	}
+	for i, s := range m.Shards {
+		if s.ShardID != ids[i] {
+			return errors.Wrapf(ErrInvalidOption,
+				"manifest in %s is for different shards", e.dir)
+		}
+	}
+	plog.Infof("resuming coordinated export in %s", e.dir)
+	e.m = m
+	return nil
+}
+
+// run invokes f concurrently for all shards, the manifest is saved once the
+// invocation for a shard returns.
+func (e *coordinatedExport) run(f func(s *BarrierShard) error) {
+	var wg sync.WaitGroup
+	for i := range e.m.Shards {
+		e.mu.Lock()
+		s := e.m.Shards[i]
+		e.mu.Unlock()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := f(&s)
+			if err != nil {
+				err = errors.Wrapf(err, "shard %d", s.ShardID)
+			}
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			e.m.Shards[i] = s
+			e.err = firstError(e.err, err)
+			if err := e.save(); err != nil {
+				e.err = firstError(e.err, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (e *coordinatedExport) export(ctx context.Context, s *BarrierShard) error {
+	fs := e.nh.fs
+	path := fmt.Sprintf("shard-%d", s.ShardID)
+	// snapshot left by a previously failed export is removed
+	dir := fs.PathJoin(e.dir, path)
+	if err := fs.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		return err
+	}
+	opt := SnapshotOption{Exported: true, ExportPath: dir}
+	ss, err := e.nh.SyncRequestSnapshotWithResult(ctx, s.ShardID, opt)
+	if err != nil {
+		return err
+	}
+	if ss.Index < s.BarrierIndex {
+		plog.Panicf("%s exported snapshot %d before barrier %d",
+			dn(s.ShardID, 0), ss.Index, s.BarrierIndex)
+	}
+	s.Path = fs.PathJoin(path, fs.PathBase(ss.Locator))
+	s.SnapshotIndex = ss.Index
+	return nil
+}
+
+// save saves the manifest to the export directory, e.mu must be held.
+func (e *coordinatedExport) save() error {
+	return barrier.Save(e.dir, e.m, e.nh.fs)
+}
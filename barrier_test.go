@@ -0,0 +1,248 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/tools"
+)
+
+// startBarrierTestShards starts single replica shards, members of restored
+// shards are recorded in their imported snapshots.
+func startBarrierTestShards(t *testing.T, nh *NodeHost,
+	replicaID uint64, restored bool, shardIDs ...uint64) {
+	for _, shardID := range shardIDs {
+		cfg := getTestConfig()
+		cfg.ShardID = shardID
+		cfg.ReplicaID = replicaID
+		members := map[uint64]string{replicaID: nh.RaftAddress()}
+		if restored {
+			members = nil
+		}
+		if err := nh.StartReplica(members,
+			false, newCloneTestSM, *cfg); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+	}
+	for _, shardID := range shardIDs {
+		waitForLeaderToBeElected(t, nh, shardID)
+	}
+}
+
+func getBarrierTestExportDir(nh *NodeHost, fs vfs.IFS) string {
+	return fs.PathJoin(nh.NodeHostConfig().NodeHostDir, "coordinated")
+}
+
+func TestSyncBarrierReturnsAppliedIndex(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		createSM: newCloneTestSM,
+		tf: func(nh *NodeHost) {
+			proposeCloneTestValue(t, nh, "k", 1)
+			n, ok := nh.getShard(1)
+			if !ok {
+				t.Fatalf("failed to get node")
+			}
+			applied := n.sm.GetLastApplied()
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			index, err := nh.SyncBarrier(ctx, 1)
+			if err != nil {
+				t.Fatalf("failed to propose barrier %v", err)
+			}
+			if index <= applied || n.sm.GetLastApplied() < index {
+				t.Errorf("unexpected barrier index %d, applied %d, now %d",
+					index, applied, n.sm.GetLastApplied())
+			}
+			if v := readCloneTestValue(t, nh, 1, "k"); v != "1" {
+				t.Errorf("unexpected value %s", v)
+			}
+			if _, err := nh.SyncBarrier(ctx, 2); !errors.Is(err, ErrShardNotFound) {
+				t.Errorf("unexpected error %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestCoordinatedExportSatisfiesBarrierOrdering(t *testing.T) {
+	fs := vfs.GetTestFS()
+	shardIDs := []uint64{3, 1, 2}
+	getShardID := func(seq uint64) uint64 {
+		return seq%uint64(len(shardIDs)) + 1
+	}
+	to := &testOption{
+		createSM: newCloneTestSM,
+		tf: func(nh *NodeHost) {
+			startBarrierTestShards(t, nh, 1, false, 2, 3)
+			// writes sequenced across all shards keep going during the export
+			acked := uint64(0)
+			stopc := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for seq := uint64(1); ; {
+					select {
+					case <-stopc:
+						return
+					default:
+					}
+					shardID := getShardID(seq)
+					cmd := []byte(fmt.Sprintf("s%d=%d", seq, seq))
+					ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+					_, err := nh.SyncPropose(ctx, nh.GetNoOPSession(shardID), cmd)
+					cancel()
+					if err == nil {
+						atomic.StoreUint64(&acked, seq)
+						seq++
+					}
+				}
+			}()
+			for atomic.LoadUint64(&acked) < 30 {
+				time.Sleep(10 * time.Millisecond)
+			}
+			before := atomic.LoadUint64(&acked)
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			dir := getBarrierTestExportDir(nh, fs)
+			m, err := nh.SyncCoordinatedExport(ctx, dir, shardIDs)
+			close(stopc)
+			wg.Wait()
+			if err != nil {
+				t.Fatalf("failed to export %v", err)
+			}
+			if !m.Complete() || len(m.Shards) != len(shardIDs) {
+				t.Fatalf("unexpected manifest %+v", m)
+			}
+			for i, s := range m.Shards {
+				if s.ShardID != uint64(i+1) || s.BarrierIndex == 0 ||
+					s.SnapshotIndex < s.BarrierIndex {
+					t.Errorf("unexpected shard record %+v", s)
+				}
+			}
+			saved, err := ReadBarrierManifest(dir, fs)
+			if err != nil {
+				t.Fatalf("failed to read manifest %v", err)
+			}
+			if !reflect.DeepEqual(&saved, &m) {
+				t.Errorf("saved manifest %+v, want %+v", saved, m)
+			}
+			nhc := config.NodeHostConfig{
+				NodeHostDir:    fs.PathJoin(nh.NodeHostConfig().NodeHostDir, "restored"),
+				RTTMillisecond: nh.NodeHostConfig().RTTMillisecond,
+				RaftAddress:    nodeHostTestAddr2,
+				Expert:         getTestExpertConfig(fs),
+			}
+			members := make(map[uint64]map[uint64]string)
+			for _, shardID := range shardIDs {
+				members[shardID] = map[uint64]string{2: nhc.RaftAddress}
+			}
+			// restored as replica 2 on another NodeHost
+			if err := tools.ImportBarrierManifest(nhc, dir, members, 2); err != nil {
+				t.Fatalf("failed to import %v", err)
+			}
+			rnh, err := NewNodeHost(nhc)
+			if err != nil {
+				t.Fatalf("failed to create NodeHost %v", err)
+			}
+			defer rnh.Close()
+			startBarrierTestShards(t, rnh, 2, true, shardIDs...)
+			// all writes acknowledged before the export are restored
+			for seq := uint64(1); seq <= before; seq++ {
+				key := fmt.Sprintf("s%d", seq)
+				if v := readCloneTestValue(t,
+					rnh, getShardID(seq), key); v != fmt.Sprint(seq) {
+					t.Fatalf("write %d not restored, got %q", seq, v)
+				}
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestCoordinatedExportCanBeResumed(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		createSM: newCloneTestSM,
+		tf: func(nh *NodeHost) {
+			startBarrierTestShards(t, nh, 1, false, 2)
+			proposeCloneTestValue(t, nh, "k", 1)
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			dir := getBarrierTestExportDir(nh, fs)
+			// shard 3 is not available yet
+			shardIDs := []uint64{1, 2, 3}
+			m, err := nh.SyncCoordinatedExport(ctx, dir, shardIDs)
+			if !errors.Is(err, ErrShardNotFound) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if m.Complete() || m.Shards[0].SnapshotIndex == 0 ||
+				m.Shards[1].SnapshotIndex == 0 || m.Shards[2].BarrierIndex != 0 {
+				t.Fatalf("unexpected manifest %+v", m)
+			}
+			saved, err := ReadBarrierManifest(dir, fs)
+			if err != nil {
+				t.Fatalf("failed to read manifest %v", err)
+			}
+			if !reflect.DeepEqual(&saved, &m) {
+				t.Errorf("saved manifest %+v, want %+v", saved, m)
+			}
+			nhc := nh.NodeHostConfig()
+			nhc.NodeHostDir = fs.PathJoin(nhc.NodeHostDir, "restored")
+			members := map[uint64]map[uint64]string{
+				1: {1: nhc.RaftAddress},
+				2: {1: nhc.RaftAddress},
+				3: {1: nhc.RaftAddress},
+			}
+			if err := tools.ImportBarrierManifest(nhc,
+				dir, members, 1); !errors.Is(err, tools.ErrIncompleteManifest) {
+				t.Errorf("unexpected error %v", err)
+			}
+			_, err = nh.SyncCoordinatedExport(ctx, dir, []uint64{1, 2})
+			if !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("unexpected error %v", err)
+			}
+			startBarrierTestShards(t, nh, 1, false, 3)
+			proposeCloneTestValue(t, nh, "k", 2)
+			resumed, err := nh.SyncCoordinatedExport(ctx, dir, shardIDs)
+			if err != nil {
+				t.Fatalf("failed to resume export %v", err)
+			}
+			if !resumed.Complete() {
+				t.Fatalf("unexpected manifest %+v", resumed)
+			}
+			// completed shards are not exported again
+			for i := 0; i < 2; i++ {
+				if !reflect.DeepEqual(resumed.Shards[i], m.Shards[i]) {
+					t.Errorf("shard record changed from %+v to %+v",
+						m.Shards[i], resumed.Shards[i])
+				}
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
@@ -0,0 +1,244 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// BatchSnapshotOrder is the order in which RequestSnapshots starts the
+// snapshot requests.
+type BatchSnapshotOrder int
+
+const (
+	// OrderByPriority starts requests with higher SnapshotRequest.Priority
+	// values first, requests with the same priority are started in the
+	// specified order.
+	OrderByPriority BatchSnapshotOrder = iota
+	// OrderByStaleness starts requests of shards with more entries applied
+	// since their last exported snapshots first, shards never exported by their
+	// local replicas are the stalest. Requests of shards not found on the
+	// NodeHost are started last.
+	OrderByStaleness
+)
+
+// SnapshotRequest is the snapshot request of a shard made by RequestSnapshots.
+type SnapshotRequest struct {
+	// ShardID is the ID of the shard to snapshot.
+	ShardID uint64
+	// Option is the option of the snapshot request, see SnapshotOption for
+	// details.
+	Option SnapshotOption
+	// Priority is the priority of the request when the requests are ordered
+	// by OrderByPriority.
+	Priority int
+}
+
+// BatchSnapshotOptions is the option type used by RequestSnapshots.
+type BatchSnapshotOptions struct {
+	// Order is the order in which the requests are started.
+	Order BatchSnapshotOrder
+	// RequestTimeout is the timeout of each snapshot request, it must be
+	// specified.
+	RequestTimeout time.Duration
+}
+
+// SnapshotOutcome is the outcome of a snapshot request made by
+// RequestSnapshots.
+type SnapshotOutcome struct {
+	// ShardID is the ID of the shard of the request.
+	ShardID uint64
+	// Result is the metadata of the created snapshot, its Index and Locator
+	// fields are always available when Err is nil. See
+	// SyncRequestSnapshotWithResult for details.
+	Result SnapshotResult
+	// Err is the error of the request, it is ErrCanceled or ErrClosed when the
+	// request was abandoned before being started.
+	Err error
+}
+
+// RequestSnapshots requests snapshots of multiple shards at once, e.g. to back
+// up all shards of the NodeHost in one go. Requests are started in the order
+// specified by opts.Order. The number of in flight requests is limited by
+// config.ExpertConfig.MaxConcurrentSnapshots, or by
+// config.EngineConfig.SnapshotShards when MaxConcurrentSnapshots is 0, the
+// next request is started once an in flight one completes.
+//
+// The outcome of each request is delivered to the returned channel once it
+// completes, the channel is closed after outcomes of all requests have been
+// delivered. Once the specified context is canceled or its deadline is
+// reached, requests not yet started are abandoned with ErrCanceled outcomes
+// while in flight requests are allowed to complete within their
+// opts.RequestTimeout. Requests not yet started when the NodeHost is closed
+// are abandoned with ErrClosed outcomes. ErrInvalidOption is returned when no request is
+// specified, the same shard is requested more than once or
+// opts.RequestTimeout is not set.
+func (nh *NodeHost) RequestSnapshots(ctx context.Context,
+	reqs []SnapshotRequest,
+	opts BatchSnapshotOptions) (_ <-chan SnapshotOutcome, err error) {
+	shardIDs := make([]uint64, 0, len(reqs))
+	for _, r := range reqs {
+		shardIDs = append(shardIDs, r.ShardID)
+	}
+	defer nh.audit(ctx, AuditEntry{
+		Operation:  "RequestSnapshots",
+		Parameters: auditParams{"Shards": shardIDs, "Options": opts},
+	}, time.Now(), &err)
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	if len(reqs) == 0 || opts.RequestTimeout <= 0 {
+		return nil, ErrInvalidOption
+	}
+	seen := make(map[uint64]struct{}, len(reqs))
+	for _, r := range reqs {
+		if _, ok := seen[r.ShardID]; ok {
+			return nil, errors.Wrapf(ErrInvalidOption,
+				"shard %d requested more than once", r.ShardID)
+		}
+		seen[r.ShardID] = struct{}{}
+		if err := r.Option.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	b := &snapshotBatch{
+		nh:       nh,
+		reqs:     nh.orderSnapshotRequests(reqs, opts.Order),
+		timeout:  opts.RequestTimeout,
+		outcomeC: make(chan SnapshotOutcome, len(reqs)),
+	}
+	nh.stopper.RunWorker(func() {
+		b.run(ctx, nh.getBatchSnapshotConcurrency())
+	})
+	return b.outcomeC, nil
+}
+
+// getBatchSnapshotConcurrency returns the max number of in flight requests
+// made by RequestSnapshots.
+func (nh *NodeHost) getBatchSnapshotConcurrency() int {
+	if limit := nh.nhConfig.Expert.MaxConcurrentSnapshots; limit > 0 {
+		return int(limit)
+	}
+	return int(nh.nhConfig.Expert.Engine.SnapshotShards)
+}
+
+// orderSnapshotRequests returns a copy of the requests in the specified order.
+func (nh *NodeHost) orderSnapshotRequests(reqs []SnapshotRequest,
+	order BatchSnapshotOrder) []SnapshotRequest {
+	result := append([]SnapshotRequest{}, reqs...)
+	if order != OrderByStaleness {
+		sort.SliceStable(result, func(i, j int) bool {
+			return result[i].Priority > result[j].Priority
+		})
+		return result
+	}
+	staleness := make(map[uint64]uint64, len(reqs))
+	for _, r := range reqs {
+		staleness[r.ShardID] = nh.getExportStaleness(r.ShardID)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return staleness[result[i].ShardID] > staleness[result[j].ShardID]
+	})
+	return result
+}
+
+// getExportStaleness returns the number of entries applied by the local
+// replica since its last exported snapshot plus one, 0 is returned when the
+// shard is not found on the NodeHost.
+func (nh *NodeHost) getExportStaleness(shardID uint64) uint64 {
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return 0
+	}
+	exported, err := n.getLastExportIndex()
+	if err != nil {
+		plog.Warningf("%s failed to get last export, %v", n.id(), err)
+		exported = 0
+	}
+	applied := n.sm.GetLastApplied()
+	if applied < exported {
+		return 1
+	}
+	return applied - exported + 1
+}
+
+// snapshotBatch is a batch of snapshot requests made by RequestSnapshots.
+type snapshotBatch struct {
+	nh       *NodeHost
+	reqs     []SnapshotRequest
+	timeout  time.Duration
+	outcomeC chan SnapshotOutcome
+}
+
+// run starts the requests in order with at most concurrency requests in
+// flight, the outcome channel is closed once all outcomes are delivered.
+func (b *snapshotBatch) run(ctx context.Context, concurrency int) {
+	defer close(b.outcomeC)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	slots := make(chan struct{}, concurrency)
+	for i, r := range b.reqs {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		case <-b.nh.stopper.ShouldStop():
+		}
+		if b.stopped() {
+			b.abandon(b.reqs[i:], ErrClosed)
+			return
+		}
+		if ctx.Err() != nil {
+			b.abandon(b.reqs[i:], ErrCanceled)
+			return
+		}
+		wg.Add(1)
+		go func(r SnapshotRequest) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			b.outcomeC <- b.request(r)
+		}(r)
+	}
+}
+
+func (b *snapshotBatch) stopped() bool {
+	select {
+	case <-b.nh.stopper.ShouldStop():
+		return true
+	default:
+		return false
+	}
+}
+
+// request makes the snapshot request, it is not affected by the cancellation
+// of the context of the batch.
+func (b *snapshotBatch) request(r SnapshotRequest) SnapshotOutcome {
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+	ss, err := b.nh.SyncRequestSnapshotWithResult(ctx, r.ShardID, r.Option)
+	return SnapshotOutcome{ShardID: r.ShardID, Result: ss, Err: err}
+}
+
+// abandon delivers outcomes of requests not yet started.
+func (b *snapshotBatch) abandon(reqs []SnapshotRequest, err error) {
+	for _, r := range reqs {
+		b.outcomeC <- SnapshotOutcome{ShardID: r.ShardID, Err: err}
+	}
+}
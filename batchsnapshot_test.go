@@ -0,0 +1,286 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+type batchSnapshotTestEnv struct {
+	active int64
+	max    int64
+	saved  int64
+}
+
+// startBatchSnapshotTestShards starts single replica shards with IDs from 1 to
+// count, count-shardID+1 proposals are made to each shard.
+func (e *batchSnapshotTestEnv) startShards(t *testing.T,
+	nh *NodeHost, count uint64) {
+	newSM := func(uint64, uint64) sm.IStateMachine {
+		return &concurrencyTrackingSM{
+			active: &e.active,
+			max:    &e.max,
+			saved:  &e.saved,
+		}
+	}
+	for shardID := uint64(1); shardID <= count; shardID++ {
+		rc := getTestConfig()
+		rc.ShardID = shardID
+		peers := map[uint64]string{1: nh.RaftAddress()}
+		if err := nh.StartReplica(peers, false, newSM, *rc); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+	}
+	for shardID := uint64(1); shardID <= count; shardID++ {
+		waitForLeaderToBeElected(t, nh, shardID)
+		session := nh.GetNoOPSession(shardID)
+		for i := uint64(0); i <= count-shardID; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
+			cancel()
+			if err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+		}
+	}
+}
+
+func getBatchSnapshotTestRequests(t *testing.T, fs vfs.IFS,
+	nh *NodeHost, count uint64) []SnapshotRequest {
+	dir := getLeaderSnapshotExportDir(t, fs, nh)
+	var reqs []SnapshotRequest
+	for shardID := uint64(1); shardID <= count; shardID++ {
+		path := fs.PathJoin(dir, fmt.Sprintf("shard-%d", shardID))
+		if err := fs.MkdirAll(path, 0755); err != nil {
+			t.Fatalf("failed to create dir %v", err)
+		}
+		reqs = append(reqs, SnapshotRequest{
+			ShardID:  shardID,
+			Option:   SnapshotOption{Exported: true, ExportPath: path},
+			Priority: int(shardID),
+		})
+	}
+	return reqs
+}
+
+func getBatchSnapshotOutcomes(t *testing.T,
+	outcomeC <-chan SnapshotOutcome) []SnapshotOutcome {
+	var outcomes []SnapshotOutcome
+	timer := time.NewTimer(30 * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case o, ok := <-outcomeC:
+			if !ok {
+				return outcomes
+			}
+			outcomes = append(outcomes, o)
+		case <-timer.C:
+			t.Fatalf("outcome channel not closed")
+		}
+	}
+}
+
+func TestBatchSnapshotRequestsAreValidated(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		noElection: true,
+		tf: func(nh *NodeHost) {
+			opts := BatchSnapshotOptions{RequestTimeout: pto(nh)}
+			ctx := context.Background()
+			reqs := []SnapshotRequest{{ShardID: 1}, {ShardID: 1}}
+			if _, err := nh.RequestSnapshots(ctx,
+				reqs, opts); !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("duplicated shard not rejected, %v", err)
+			}
+			if _, err := nh.RequestSnapshots(ctx,
+				reqs[:1], BatchSnapshotOptions{}); !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("missing timeout not rejected, %v", err)
+			}
+			if _, err := nh.RequestSnapshots(ctx,
+				nil, opts); !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("empty batch not rejected, %v", err)
+			}
+			invalid := []SnapshotRequest{
+				{ShardID: 1, Option: SnapshotOption{LeaderOnly: true}},
+			}
+			if _, err := nh.RequestSnapshots(ctx,
+				invalid, opts); !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("invalid option not rejected, %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestBatchSnapshotRequestsRespectConcurrencyLimit(t *testing.T) {
+	fs := vfs.GetTestFS()
+	count := uint64(12)
+	env := &batchSnapshotTestEnv{}
+	to := &testOption{
+		noElection: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.Expert.MaxConcurrentSnapshots = 2
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			env.startShards(t, nh, count)
+			reqs := getBatchSnapshotTestRequests(t, fs, nh, count)
+			reqs = append(reqs, SnapshotRequest{ShardID: count + 1})
+			outcomeC, err := nh.RequestSnapshots(context.Background(),
+				reqs, BatchSnapshotOptions{RequestTimeout: pto(nh)})
+			if err != nil {
+				t.Fatalf("failed to request snapshots %v", err)
+			}
+			outcomes := getBatchSnapshotOutcomes(t, outcomeC)
+			if len(outcomes) != len(reqs) {
+				t.Fatalf("got %d outcomes, want %d", len(outcomes), len(reqs))
+			}
+			seen := make(map[uint64]struct{})
+			for _, o := range outcomes {
+				seen[o.ShardID] = struct{}{}
+				if o.ShardID == count+1 {
+					if !errors.Is(o.Err, ErrShardNotFound) {
+						t.Errorf("unexpected error %v", o.Err)
+					}
+					continue
+				}
+				if o.Err != nil {
+					t.Fatalf("shard %d failed %v", o.ShardID, o.Err)
+				}
+				if o.Result.Index == 0 || len(o.Result.Locator) == 0 {
+					t.Errorf("unexpected result %+v", o.Result)
+				}
+				if _, err := fs.Stat(o.Result.Locator); err != nil {
+					t.Errorf("snapshot not exported, %v", err)
+				}
+			}
+			if len(seen) != len(reqs) {
+				t.Errorf("outcomes of %d shards, want %d", len(seen), len(reqs))
+			}
+			if v := atomic.LoadInt64(&env.saved); v != int64(count) {
+				t.Errorf("%d snapshots saved, want %d", v, count)
+			}
+			if v := atomic.LoadInt64(&env.max); v > 2 {
+				t.Errorf("%d snapshots saved concurrently, limit 2", v)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestBatchSnapshotRequestsCanBeOrderedByStaleness(t *testing.T) {
+	fs := vfs.GetTestFS()
+	count := uint64(4)
+	env := &batchSnapshotTestEnv{}
+	to := &testOption{
+		noElection: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.Expert.MaxConcurrentSnapshots = 1
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			env.startShards(t, nh, count)
+			reqs := getBatchSnapshotTestRequests(t, fs, nh, count)
+			// shard 1 has the most entries but it has just been exported
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			if _, err := nh.SyncExportSnapshot(ctx, 1, reqs[0].Option); err != nil {
+				t.Fatalf("failed to export %v", err)
+			}
+			proposeTestData(t, nh, "stale", 1)
+			opts := BatchSnapshotOptions{
+				Order:          OrderByStaleness,
+				RequestTimeout: pto(nh),
+			}
+			outcomeC, err := nh.RequestSnapshots(ctx, reqs, opts)
+			if err != nil {
+				t.Fatalf("failed to request snapshots %v", err)
+			}
+			outcomes := getBatchSnapshotOutcomes(t, outcomeC)
+			var order []uint64
+			for _, o := range outcomes {
+				if o.Err != nil {
+					t.Fatalf("shard %d failed %v", o.ShardID, o.Err)
+				}
+				order = append(order, o.ShardID)
+			}
+			if fmt.Sprint(order) != "[2 3 4 1]" {
+				t.Errorf("unexpected order %v", order)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestCanceledBatchSnapshotRequestsAreAbandoned(t *testing.T) {
+	fs := vfs.GetTestFS()
+	count := uint64(8)
+	env := &batchSnapshotTestEnv{}
+	to := &testOption{
+		noElection: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.Expert.MaxConcurrentSnapshots = 1
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			env.startShards(t, nh, count)
+			reqs := getBatchSnapshotTestRequests(t, fs, nh, count)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			outcomeC, err := nh.RequestSnapshots(ctx,
+				reqs, BatchSnapshotOptions{RequestTimeout: pto(nh)})
+			if err != nil {
+				t.Fatalf("failed to request snapshots %v", err)
+			}
+			first := <-outcomeC
+			cancel()
+			// the highest priority request is started first
+			if first.ShardID != count || first.Err != nil {
+				t.Fatalf("unexpected outcome %+v", first)
+			}
+			outcomes := getBatchSnapshotOutcomes(t, outcomeC)
+			if len(outcomes) != int(count)-1 {
+				t.Fatalf("got %d outcomes, want %d", len(outcomes), count-1)
+			}
+			canceled := 0
+			for _, o := range outcomes {
+				if errors.Is(o.Err, ErrCanceled) {
+					canceled++
+				} else if o.Err != nil {
+					t.Errorf("in flight request failed %v", o.Err)
+				}
+			}
+			// at most one request was started before the cancellation
+			if canceled < int(count)-2 {
+				t.Errorf("only %d requests abandoned", canceled)
+			}
+			if v := atomic.LoadInt64(&env.saved); v != int64(count)-int64(canceled) {
+				t.Errorf("%d snapshots saved, %d abandoned", v, canceled)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
@@ -15,15 +15,24 @@
 package dragonboat
 
 import (
+	"context"
 	"crypto/rand"
+	"fmt"
+	"io"
 	mrand "math/rand"
 	"os"
+	"runtime"
+	"runtime/pprof"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/cockroachdb/errors"
 	"github.com/golang/snappy"
 	"github.com/lni/goutils/random"
+	"github.com/lni/goutils/syncutil"
 
 	"github.com/lni/dragonboat/v4/client"
 	"github.com/lni/dragonboat/v4/config"
@@ -37,6 +46,8 @@ import (
 	"github.com/lni/dragonboat/v4/internal/utils/dio"
 	"github.com/lni/dragonboat/v4/internal/vfs"
 	"github.com/lni/dragonboat/v4/logger"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	"github.com/lni/dragonboat/v4/raftio"
 	pb "github.com/lni/dragonboat/v4/raftpb"
 	sm "github.com/lni/dragonboat/v4/statemachine"
 )
@@ -119,6 +130,30 @@ func BenchmarkAddToEntryQueue(b *testing.B) {
 	})
 }
 
+func BenchmarkIsLeader(b *testing.B) {
+	b.ReportAllocs()
+	nh := &NodeHost{}
+	n := &node{
+		shardID:    1,
+		replicaID:  1,
+		raftEvents: newRaftEventListener(1, 1, false, nil, nil),
+	}
+	n.raftEvents.LeaderUpdated(server.LeaderInfo{
+		ShardID:   1,
+		ReplicaID: 1,
+		LeaderID:  1,
+		Term:      2,
+	})
+	nh.mu.shards.Store(uint64(1), n)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if ok, _ := nh.IsLeader(1); !ok {
+				b.Errorf("not reported as leader")
+			}
+		}
+	})
+}
+
 func benchmarkProposeN(b *testing.B, sz int) {
 	b.ReportAllocs()
 	data := make([]byte, sz)
@@ -138,7 +173,7 @@ func benchmarkProposeN(b *testing.B, sz int) {
 		for pb.Next() {
 			v := atomic.AddUint32(&total, 1)
 			b.SetBytes(int64(sz))
-			rs, err := pp.propose(session, data, 100)
+			rs, err := pp.propose(context.Background(), session, data, 100)
 			if err != nil {
 				b.Errorf("%v", err)
 			}
@@ -200,7 +235,7 @@ func BenchmarkReadIndexRead(b *testing.B) {
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
 			v := atomic.AddUint32(&total, 1)
-			rs, err := pri.read(100)
+			rs, err := pri.read(context.Background(), 100)
 			if err != nil {
 				b.Errorf("%v", err)
 			}
@@ -214,6 +249,746 @@ func BenchmarkReadIndexRead(b *testing.B) {
 	})
 }
 
+// BenchmarkNAReadLocalNode measures the ReadIndex and NAReadLocalNode based
+// read path of a single replica shard with a state machine implementing the
+// statemachine.IByteLookup interface. The fast path is expected to be free of
+// heap allocations.
+func BenchmarkNAReadLocalNode(b *testing.B) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+		b.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			b.Fatalf("%v", err)
+		}
+	}()
+	network := memtransport.NewNetwork()
+	nhc := network.NodeHostConfigs(1, singleNodeHostTestDir, 10)[0]
+	nhc.Expert = getTestExpertConfig(fs)
+	nhc.Expert.TransportFactory = network
+	nh, err := NewNodeHost(nhc)
+	if err != nil {
+		b.Fatalf("failed to create nodehost %v", err)
+	}
+	defer nh.Close()
+	rc := config.Config{
+		ShardID:      1,
+		ReplicaID:    1,
+		ElectionRTT:  10,
+		HeartbeatRTT: 1,
+	}
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &byteLookupTestSM{result: make([]byte, 8)}
+	}
+	peers := map[uint64]string{1: nhc.RaftAddress}
+	if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+		b.Fatalf("failed to start replica %v", err)
+	}
+	query := make([]byte, 8)
+	read := func() error {
+		rs, err := nh.ReadIndex(1, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		if v := <-rs.ResultC(); !v.Completed() {
+			return ErrTimeout
+		}
+		defer rs.Release()
+		_, err = nh.NAReadLocalNode(rs, query)
+		return err
+	}
+	for i := 0; read() != nil; i++ {
+		if i == 1000 {
+			b.Fatalf("shard not ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := read(); err != nil {
+			b.Fatalf("failed to read %v", err)
+		}
+	}
+}
+
+// benchmarkSyncRead issues concurrent linearizable reads on the leader of a
+// three replica shard and reports the number of ReadIndex rounds and the
+// heartbeat messages they required per read.
+func benchmarkSyncRead(b *testing.B, delay time.Duration) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+		b.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			b.Fatalf("%v", err)
+		}
+	}()
+	network := memtransport.NewNetwork()
+	configs := network.NodeHostConfigs(3, singleNodeHostTestDir, 10)
+	peers := make(map[uint64]string)
+	for i := range configs {
+		peers[uint64(i+1)] = configs[i].RaftAddress
+	}
+	nhs := make([]*NodeHost, 0, len(configs))
+	defer func() {
+		for _, nh := range nhs {
+			nh.Close()
+		}
+	}()
+	for i, nhc := range configs {
+		nhc.Expert = getTestExpertConfig(fs)
+		nhc.Expert.TransportFactory = network
+		nhc.Expert.Engine.ReadBatchDelay = delay
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			b.Fatalf("failed to create nodehost %v", err)
+		}
+		nhs = append(nhs, nh)
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    uint64(i + 1),
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
+		}
+		createSM := func(uint64, uint64) sm.IStateMachine {
+			return &PST{}
+		}
+		if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+			b.Fatalf("failed to start replica %v", err)
+		}
+	}
+	var leader *NodeHost
+	for i := 0; i < 1000 && leader == nil; i++ {
+		leaderID, _, ok, err := nhs[0].GetLeaderID(1)
+		if err == nil && ok {
+			leader = nhs[leaderID-1]
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if leader == nil {
+		b.Fatalf("failed to elect leader")
+	}
+	// ReadIndex requests are dropped until the leader committed an entry from
+	// its term
+	for i := 0; ; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := leader.SyncRead(ctx, 1, nil)
+		cancel()
+		if err == nil {
+			break
+		}
+		if i == 1000 {
+			b.Fatalf("leader not ready, %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// reads only coalesce when they arrive while a ReadIndex round is in flight
+	network.SetLatency(time.Millisecond)
+	before := leader.GetEngineStats().ReadIndex
+	// RunParallel hands out iterations in chunks, reads might be issued by a
+	// single goroutine, a fixed number of readers is used instead.
+	remaining := int64(b.N)
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.AddInt64(&remaining, -1) >= 0 {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				_, err := leader.SyncRead(ctx, 1, nil)
+				cancel()
+				if err != nil {
+					b.Errorf("failed to read %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+	after := leader.GetEngineStats().ReadIndex
+	rounds := float64(after.Rounds - before.Rounds)
+	b.ReportMetric(rounds/float64(b.N), "rounds/op")
+	b.ReportMetric(rounds*float64(len(nhs)-1)/float64(b.N), "heartbeats/op")
+}
+
+func BenchmarkSyncRead(b *testing.B) {
+	benchmarkSyncRead(b, 0)
+}
+
+func BenchmarkCoalescedSyncRead(b *testing.B) {
+	benchmarkSyncRead(b, 10*time.Millisecond)
+}
+
+// slowApplySM is a state machine taking 1ms to apply each entry, e.g. when it
+// is waiting for I/O.
+type slowApplySM struct {
+	PST
+}
+
+func (s *slowApplySM) Update(e sm.Entry) (sm.Result, error) {
+	time.Sleep(time.Millisecond)
+	return s.PST.Update(e)
+}
+
+// benchmarkHeavyShard measures the latency of proposals made to a light shard
+// when it shares a NodeHost with a shard kept busy by a slow state machine.
+// Both shards are assigned to the same apply worker by default.
+func benchmarkHeavyShard(b *testing.B, isolated bool) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+		b.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			b.Fatalf("%v", err)
+		}
+	}()
+	network := memtransport.NewNetwork()
+	nhc := network.NodeHostConfigs(1, singleNodeHostTestDir, 10)[0]
+	nhc.Expert = getTestExpertConfig(fs)
+	nhc.Expert.TransportFactory = network
+	nhc.Expert.Engine.ApplyShards = 2
+	if isolated {
+		nhc.Expert.Engine.WorkerAffinity = func(shardID uint64) uint64 {
+			if shardID == 1 {
+				return 0
+			}
+			return 1
+		}
+	}
+	nh, err := NewNodeHost(nhc)
+	if err != nil {
+		b.Fatalf("failed to create nodehost %v", err)
+	}
+	defer nh.Close()
+	peers := map[uint64]string{1: nhc.RaftAddress}
+	for _, shardID := range []uint64{1, 3} {
+		createSM := func(uint64, uint64) sm.IStateMachine {
+			return &PST{}
+		}
+		if shardID == 1 {
+			createSM = func(uint64, uint64) sm.IStateMachine {
+				return &slowApplySM{}
+			}
+		}
+		rc := config.Config{
+			ShardID:      shardID,
+			ReplicaID:    1,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+		}
+		if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+			b.Fatalf("failed to start replica %v", err)
+		}
+	}
+	propose := func(shardID uint64) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := nh.SyncPropose(ctx, nh.GetNoOPSession(shardID), []byte("data"))
+		return err
+	}
+	for _, shardID := range []uint64{1, 3} {
+		for i := 0; propose(shardID) != nil; i++ {
+			if i == 1000 {
+				b.Fatalf("shard %d not ready", shardID)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	stopper := syncutil.NewStopper()
+	for i := 0; i < 8; i++ {
+		stopper.RunWorker(func() {
+			for {
+				select {
+				case <-stopper.ShouldStop():
+					return
+				default:
+				}
+				if err := propose(1); err != nil {
+					b.Errorf("failed to propose %v", err)
+					return
+				}
+			}
+		})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := propose(3); err != nil {
+			b.Fatalf("failed to propose %v", err)
+		}
+	}
+	b.StopTimer()
+	stopper.Stop()
+}
+
+func BenchmarkSharedApplyWorker(b *testing.B) {
+	benchmarkHeavyShard(b, false)
+}
+
+func BenchmarkIsolatedApplyWorker(b *testing.B) {
+	benchmarkHeavyShard(b, true)
+}
+
+// BenchmarkProposeWithSlowApply makes bursts of proposals to a shard with a
+// slow state machine and reports the number of proposals rejected with
+// ErrSystemBusy. Entries not applied yet can not be released from memory, the
+// reported rate reflects how far the state machine falls behind the bursts.
+func BenchmarkProposeWithSlowApply(b *testing.B) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+		b.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			b.Fatalf("%v", err)
+		}
+	}()
+	network := memtransport.NewNetwork()
+	nhc := network.NodeHostConfigs(1, singleNodeHostTestDir, 10)[0]
+	nhc.Expert = getTestExpertConfig(fs)
+	nhc.Expert.TransportFactory = network
+	nh, err := NewNodeHost(nhc)
+	if err != nil {
+		b.Fatalf("failed to create nodehost %v", err)
+	}
+	defer nh.Close()
+	rc := config.Config{
+		ShardID:         1,
+		ReplicaID:       1,
+		ElectionRTT:     10,
+		HeartbeatRTT:    1,
+		MaxInMemLogSize: 256 * 1024,
+	}
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &slowApplySM{}
+	}
+	peers := map[uint64]string{1: nhc.RaftAddress}
+	if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+		b.Fatalf("failed to start replica %v", err)
+	}
+	session := nh.GetNoOPSession(1)
+	for i := 0; ; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := nh.SyncPropose(ctx, session, []byte("data"))
+		cancel()
+		if err == nil {
+			break
+		}
+		if i == 1000 {
+			b.Fatalf("shard not ready, %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cmd := make([]byte, 1024)
+	busy := 0
+	requests := make([]*RequestState, 0, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// bursts of 128 proposals, each about 50% of MaxInMemLogSize
+		if i > 0 && i%128 == 0 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		rs, err := nh.Propose(session, cmd, time.Minute)
+		if errors.Is(err, ErrSystemBusy) {
+			busy++
+			continue
+		}
+		if err != nil {
+			b.Fatalf("failed to propose %v", err)
+		}
+		requests = append(requests, rs)
+	}
+	for _, rs := range requests {
+		if r := <-rs.ResultC(); !r.Completed() {
+			busy++
+		}
+		rs.Release()
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(busy)/float64(b.N), "busy/op")
+}
+
+// benchmarkProposalBatching measures the proposal throughput and the p99
+// proposal latency of a three replica shard with the specified proposal batch
+// delay when each fsync of the LogDB takes 1ms.
+func benchmarkProposalBatching(b *testing.B, delay time.Duration) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+		b.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			b.Fatalf("%v", err)
+		}
+	}()
+	network := memtransport.NewNetwork()
+	configs := network.NodeHostConfigs(3, singleNodeHostTestDir, 10)
+	peers := make(map[uint64]string)
+	for i := range configs {
+		peers[uint64(i+1)] = configs[i].RaftAddress
+	}
+	nhs := make([]*NodeHost, 0, len(configs))
+	defer func() {
+		for _, nh := range nhs {
+			nh.Close()
+		}
+	}()
+	for i, nhc := range configs {
+		nhc.Expert = getTestExpertConfig(vfs.Wrap(fs, &slowSyncInjector{slow: 1, delay: time.Millisecond}))
+		nhc.Expert.TransportFactory = network
+		nhc.Expert.Engine.ProposalBatchDelayMicroseconds =
+			uint64(delay / time.Microsecond)
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			b.Fatalf("failed to create nodehost %v", err)
+		}
+		nhs = append(nhs, nh)
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    uint64(i + 1),
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+		}
+		createSM := func(uint64, uint64) sm.IStateMachine {
+			return &PST{}
+		}
+		if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+			b.Fatalf("failed to start replica %v", err)
+		}
+	}
+	var leader *NodeHost
+	for i := 0; i < 1000 && leader == nil; i++ {
+		leaderID, _, ok, err := nhs[0].GetLeaderID(1)
+		if err == nil && ok {
+			leader = nhs[leaderID-1]
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if leader == nil {
+		b.Fatalf("failed to elect leader")
+	}
+	session := leader.GetNoOPSession(1)
+	propose := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := leader.SyncPropose(ctx, session, make([]byte, 128))
+		return err
+	}
+	for i := 0; propose() != nil; i++ {
+		if i == 1000 {
+			b.Fatalf("leader not ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	remaining := int64(b.N)
+	latencies := make([]time.Duration, b.N)
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				idx := atomic.AddInt64(&remaining, -1)
+				if idx < 0 {
+					return
+				}
+				start := time.Now()
+				if err := propose(); err != nil {
+					b.Errorf("failed to propose %v", err)
+				}
+				latencies[idx] = time.Since(start)
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	p99 := latencies[len(latencies)*99/100]
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "proposals/s")
+	b.ReportMetric(float64(p99.Microseconds()), "p99-us")
+}
+
+func BenchmarkProposalBatching(b *testing.B) {
+	for _, delay := range []time.Duration{
+		0,
+		50 * time.Microsecond,
+		100 * time.Microsecond,
+		200 * time.Microsecond,
+		500 * time.Microsecond,
+	} {
+		b.Run(fmt.Sprintf("delay=%v", delay), func(b *testing.B) {
+			benchmarkProposalBatching(b, delay)
+		})
+	}
+}
+
+// slowBatchSM is a concurrent state machine taking 1ms to apply each batch of
+// entries.
+type slowBatchSM struct {
+	count uint64
+}
+
+func (s *slowBatchSM) Update(ents []sm.Entry) ([]sm.Entry, error) {
+	time.Sleep(time.Millisecond)
+	for i := range ents {
+		s.count++
+		ents[i].Result = sm.Result{Value: s.count}
+	}
+	return ents, nil
+}
+
+func (s *slowBatchSM) Lookup(query interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func (s *slowBatchSM) PrepareSnapshot() (interface{}, error) {
+	return nil, nil
+}
+
+func (s *slowBatchSM) SaveSnapshot(ctx interface{}, w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	return nil
+}
+
+func (s *slowBatchSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	return nil
+}
+
+func (s *slowBatchSM) Close() error { return nil }
+
+// BenchmarkPipelinedApply measures the end-to-end throughput of a three
+// replica shard, proposals are completed once applied by all replicas. The
+// state machine takes 1ms to apply each batch of entries, each fsync of the
+// LogDB of one of the followers takes 1ms.
+func BenchmarkPipelinedApply(b *testing.B) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+		b.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			b.Fatalf("%v", err)
+		}
+	}()
+	network := memtransport.NewNetwork()
+	configs := network.NodeHostConfigs(3, singleNodeHostTestDir, 10)
+	peers := make(map[uint64]string)
+	for i := range configs {
+		peers[uint64(i+1)] = configs[i].RaftAddress
+	}
+	nhs := make([]*NodeHost, 0, len(configs))
+	injectors := make([]*slowSyncInjector, 0, len(configs))
+	defer func() {
+		for _, nh := range nhs {
+			nh.Close()
+		}
+	}()
+	for i, nhc := range configs {
+		injector := &slowSyncInjector{delay: time.Millisecond}
+		injectors = append(injectors, injector)
+		nhc.Expert = getTestExpertConfig(vfs.Wrap(fs, injector))
+		nhc.Expert.TransportFactory = network
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			b.Fatalf("failed to create nodehost %v", err)
+		}
+		nhs = append(nhs, nh)
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    uint64(i + 1),
+			ElectionRTT:  50,
+			HeartbeatRTT: 1,
+		}
+		createSM := func(uint64, uint64) sm.IConcurrentStateMachine {
+			return &slowBatchSM{}
+		}
+		if err := nh.StartConcurrentReplica(peers,
+			false, createSM, rc); err != nil {
+			b.Fatalf("failed to start replica %v", err)
+		}
+	}
+	var leader *NodeHost
+	for i := 0; i < 1000 && leader == nil; i++ {
+		leaderID, _, ok, err := nhs[0].GetLeaderID(1)
+		if err == nil && ok {
+			leader = nhs[leaderID-1]
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if leader == nil {
+		b.Fatalf("failed to elect leader")
+	}
+	// one follower persists entries slower than the rest of the shard, it
+	// keeps receiving entries already committed by the leader and the other
+	// follower
+	for i, nh := range nhs {
+		if nh != leader {
+			atomic.StoreInt32(&injectors[i].slow, 1)
+			break
+		}
+	}
+	session := leader.GetNoOPSession(1)
+	propose := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := leader.SyncPropose(ctx, session, make([]byte, 128))
+		return err
+	}
+	for i := 0; propose() != nil; i++ {
+		if i == 1000 {
+			b.Fatalf("leader not ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	remaining := int64(b.N)
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.AddInt64(&remaining, -1) >= 0 {
+				if err := propose(); err != nil {
+					b.Errorf("failed to propose %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// all replicas are required to have the proposals applied
+	index := getTestLastApplied(leader)
+	for _, nh := range nhs {
+		for getTestLastApplied(nh) < index {
+			time.Sleep(100 * time.Microsecond)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "proposals/s")
+}
+
+// BenchmarkStandbyActivation measures the time taken to activate a warm
+// standby replica of a shard with 2000 entries and compares it with the time
+// taken by a new non-voting replica to join the shard and apply the same
+// entries.
+func BenchmarkStandbyActivation(b *testing.B) {
+	fs := vfs.GetTestFS()
+	var activation time.Duration
+	var coldJoin time.Duration
+	for i := 0; i < b.N; i++ {
+		func() {
+			if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+				b.Fatalf("%v", err)
+			}
+			defer func() {
+				if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+					b.Fatalf("%v", err)
+				}
+			}()
+			network := memtransport.NewNetwork()
+			nhs := make([]*NodeHost, 0, 3)
+			defer func() {
+				for _, nh := range nhs {
+					nh.Close()
+				}
+			}()
+			for _, nhc := range network.NodeHostConfigs(3,
+				singleNodeHostTestDir, 10) {
+				nhc.Expert = getTestExpertConfig(fs)
+				nhc.Expert.TransportFactory = network
+				nh, err := NewNodeHost(nhc)
+				if err != nil {
+					b.Fatalf("failed to create nodehost %v", err)
+				}
+				nhs = append(nhs, nh)
+			}
+			startStandbyTestLeader(b, nhs[0])
+			addNonVotingTestReplica(b, nhs[0], nhs[1], 2, true)
+			proposeStandbyTestEntries(b, nhs[0], 2000)
+			index := getTestLastApplied(nhs[0])
+			waitForTestLastApplied(b, nhs[1], index)
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			start := time.Now()
+			if err := nhs[1].ActivateStandby(ctx, 1); err != nil {
+				b.Fatalf("failed to activate standby %v", err)
+			}
+			activation += time.Since(start)
+			start = time.Now()
+			addNonVotingTestReplica(b, nhs[0], nhs[2], 3, false)
+			waitForTestLastApplied(b, nhs[2], index)
+			coldJoin += time.Since(start)
+		}()
+	}
+	b.ReportMetric(float64(activation.Milliseconds())/float64(b.N),
+		"activation-ms")
+	b.ReportMetric(float64(coldJoin.Milliseconds())/float64(b.N),
+		"coldjoin-ms")
+}
+
+// benchmarkIdleShardTicks measures the tick worker CPU time of a NodeHost with
+// 30k shards in each tick, including ready notifications to step workers and
+// step workers collecting the ready shards. Each ready shard is stepped by a
+// step worker to handle its tick, step workers thus have proportionally more
+// work when more shards are ticked.
+func benchmarkIdleShardTicks(b *testing.B, quiesced bool) {
+	const shards = 30000
+	nh := &NodeHost{ticker: newTickScheduler()}
+	wr := newWorkReady(16)
+	nodes := make([]*node, 0, shards)
+	for i := uint64(1); i <= shards; i++ {
+		n := &node{
+			shardID: i,
+			config:  config.Config{ShardID: i, ElectionRTT: 10},
+			mq:      server.NewMessageQueue(16, false, 0, 0),
+			qs:      &quiesceState{enabled: quiesced},
+		}
+		if quiesced {
+			n.qs.quiescedSince = 1
+			atomic.StoreUint32(&n.qs.quiescedFlag, 1)
+		}
+		nodes = append(nodes, n)
+	}
+	nh.ticker.update(nodes)
+	b.ReportAllocs()
+	b.ResetTimer()
+	ticked := 0
+	for i := 0; i < b.N; i++ {
+		tick, ready := nh.ticker.next()
+		nh.sendTickMessage(ready, tick)
+		wr.allShardsReady(ready)
+		ticked += len(ready)
+		for w := uint64(1); w <= 16; w++ {
+			wr.getReadyMap(w)
+		}
+		// messages are consumed by step workers
+		for _, n := range ready {
+			n.mq.Get()
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(ticked)/float64(b.N), "shards/tick")
+}
+
+func BenchmarkActiveShardTicks(b *testing.B) {
+	benchmarkIdleShardTicks(b, false)
+}
+
+func BenchmarkQuiescedShardTicks(b *testing.B) {
+	benchmarkIdleShardTicks(b, true)
+}
+
 func benchmarkMarshalEntryN(b *testing.B, sz int) {
 	b.ReportAllocs()
 	e := pb.Entry{
@@ -395,8 +1170,13 @@ func (h *benchmarkMessageHandler) HandleSnapshot(shardID uint64,
 
 type dummyTransportEvent struct{}
 
-func (d *dummyTransportEvent) ConnectionEstablished(addr string, snapshot bool) {}
-func (d *dummyTransportEvent) ConnectionFailed(addr string, snapshot bool)      {}
+func (d *dummyTransportEvent) ConnectionEstablished(addr string, snapshot bool)    {}
+func (d *dummyTransportEvent) ConnectionFailed(addr string, snapshot bool)         {}
+func (d *dummyTransportEvent) ConnectionRejected(addr string)                      {}
+func (d *dummyTransportEvent) MisdeliveredMessage(string, uint64, uint64)          {}
+func (d *dummyTransportEvent) SnapshotReceiveStarted(raftio.SnapshotInfo)          {}
+func (d *dummyTransportEvent) SnapshotReceiveProgress(raftio.SnapshotProgressInfo) {}
+func (d *dummyTransportEvent) SnapshotReceiveAborted(raftio.SnapshotAbortInfo)     {}
 
 func benchmarkTransport(b *testing.B, sz int) {
 	b.ReportAllocs()
@@ -576,7 +1356,6 @@ func benchmarkStateMachineStep(b *testing.B, sz int, noopSession bool) {
 	}
 	entries := make([]pb.Entry, 0)
 	batch := make([]rsm.Task, 0, 100000)
-	smEntries := make([]sm.Entry, 0)
 	task := rsm.Task{Recover: false}
 	if !noopSession {
 		idx++
@@ -585,7 +1364,7 @@ func benchmarkStateMachineStep(b *testing.B, sz int, noopSession bool) {
 		entries = append(entries, e)
 		task.Entries = entries
 		smo.TaskQ().Add(task)
-		if _, err := smo.Handle(batch, smEntries); err != nil {
+		if _, err := smo.Handle(batch); err != nil {
 			b.Fatalf("handle failed %v", err)
 		}
 	}
@@ -599,7 +1378,7 @@ func benchmarkStateMachineStep(b *testing.B, sz int, noopSession bool) {
 		}
 		task.Entries = entries
 		smo.TaskQ().Add(task)
-		if _, err := smo.Handle(batch, smEntries); err != nil {
+		if _, err := smo.Handle(batch); err != nil {
 			b.Fatalf("handle failed %v", err)
 		}
 	}
@@ -629,6 +1408,58 @@ func BenchmarkStateMachineStep1024(b *testing.B) {
 	benchmarkStateMachineStep(b, 1024, false)
 }
 
+// benchmarkEncodedEntryApply applies batches of snappy compressed entries,
+// allocations and GC pauses per applied entry are reported.
+func benchmarkEncodedEntryApply(b *testing.B, store sm.IConcurrentStateMachine) {
+	b.ReportAllocs()
+	b.StopTimer()
+	done := make(chan struct{})
+	config := config.Config{ShardID: 1, ReplicaID: 1}
+	nds := rsm.NewNativeSM(config, rsm.NewConcurrentStateMachine(store), done)
+	smo := rsm.NewStateMachine(nds, nil, config, &testDummyNodeProxy{}, vfs.DefaultFS)
+	s := client.NewNoOPSession(1, random.LockGuardedRand)
+	e := pb.Entry{
+		Term:     123,
+		Type:     pb.EncodedEntry,
+		ClientID: s.ClientID,
+		SeriesID: s.SeriesID,
+		Cmd:      rsm.GetEncoded(dio.Snappy, make([]byte, 1024), nil),
+	}
+	idx := uint64(0)
+	entries := make([]pb.Entry, 128)
+	batch := make([]rsm.Task, 0, 100000)
+	var start runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&start)
+	b.StartTimer()
+	for x := 0; x < b.N; x++ {
+		for i := range entries {
+			idx++
+			e.Index = idx
+			entries[i] = e
+		}
+		smo.TaskQ().Add(rsm.Task{Entries: entries})
+		if _, err := smo.Handle(batch); err != nil {
+			b.Fatalf("handle failed %v", err)
+		}
+	}
+	b.StopTimer()
+	var end runtime.MemStats
+	runtime.ReadMemStats(&end)
+	applied := float64(b.N * len(entries))
+	b.ReportMetric(float64(end.Mallocs-start.Mallocs)/applied, "allocs/entry")
+	b.ReportMetric(float64(end.PauseTotalNs-start.PauseTotalNs)/applied,
+		"gc-pause-ns/entry")
+}
+
+func BenchmarkEncodedEntryApply(b *testing.B) {
+	benchmarkEncodedEntryApply(b, &tests.ConcurrentNoOP{})
+}
+
+func BenchmarkNonRetainingEncodedEntryApply(b *testing.B) {
+	benchmarkEncodedEntryApply(b, &tests.NonRetainingConcurrentNoOP{})
+}
+
 type noopSink struct{}
 
 func (n *noopSink) Receive(pb.Chunk) (bool, bool) { return true, false }
@@ -709,3 +1540,328 @@ func BenchmarkMustMarshal(b *testing.B) {
 		mustMarshalData(e)
 	}
 }
+
+func benchmarkWorkerLabels(b *testing.B, enabled bool) {
+	b.ReportAllocs()
+	defer pprof.SetGoroutineLabels(context.Background())
+	n := &node{profilerLabels: getShardProfilerLabels(1, 1)}
+	labels := newWorkerLabels(enabled, stepWorkerRole, 1)
+	count := 0
+	for i := 0; i < b.N; i++ {
+		labels.do(n, func() { count++ })
+	}
+	if count != b.N {
+		b.Fatalf("count %d, want %d", count, b.N)
+	}
+}
+
+func BenchmarkWorkerLabelsDisabled(b *testing.B) {
+	benchmarkWorkerLabels(b, false)
+}
+
+func BenchmarkWorkerLabelsEnabled(b *testing.B) {
+	benchmarkWorkerLabels(b, true)
+}
+
+// benchmarkWriteFsyncMode measures the proposal throughput and the p99
+// proposal latency of a three replica shard using the specified write fsync
+// mode when each fsync of the LogDB takes 5ms.
+func benchmarkWriteFsyncMode(b *testing.B, mode config.WriteFsyncMode) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+		b.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			b.Fatalf("%v", err)
+		}
+	}()
+	network := memtransport.NewNetwork()
+	configs := network.NodeHostConfigs(3, singleNodeHostTestDir, 10)
+	peers := make(map[uint64]string)
+	for i := range configs {
+		peers[uint64(i+1)] = configs[i].RaftAddress
+	}
+	nhs := make([]*NodeHost, 0, len(configs))
+	defer func() {
+		for _, nh := range nhs {
+			nh.Close()
+		}
+	}()
+	for i, nhc := range configs {
+		nhc.Expert = getTestExpertConfig(vfs.Wrap(fs, &slowSyncInjector{slow: 1, delay: 5 * time.Millisecond}))
+		nhc.Expert.TransportFactory = network
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			b.Fatalf("failed to create nodehost %v", err)
+		}
+		nhs = append(nhs, nh)
+		rc := config.Config{
+			ShardID:        1,
+			ReplicaID:      uint64(i + 1),
+			ElectionRTT:    10,
+			HeartbeatRTT:   1,
+			WriteFsyncMode: mode,
+		}
+		createSM := func(uint64, uint64) sm.IStateMachine {
+			return &PST{}
+		}
+		if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+			b.Fatalf("failed to start replica %v", err)
+		}
+	}
+	var leader *NodeHost
+	for i := 0; i < 1000 && leader == nil; i++ {
+		leaderID, _, ok, err := nhs[0].GetLeaderID(1)
+		if err == nil && ok {
+			leader = nhs[leaderID-1]
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if leader == nil {
+		b.Fatalf("failed to elect leader")
+	}
+	session := leader.GetNoOPSession(1)
+	propose := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := leader.SyncPropose(ctx, session, make([]byte, 128))
+		return err
+	}
+	for i := 0; propose() != nil; i++ {
+		if i == 1000 {
+			b.Fatalf("leader not ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	remaining := int64(b.N)
+	latencies := make([]time.Duration, b.N)
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				idx := atomic.AddInt64(&remaining, -1)
+				if idx < 0 {
+					return
+				}
+				start := time.Now()
+				if err := propose(); err != nil {
+					b.Errorf("failed to propose %v", err)
+				}
+				latencies[idx] = time.Since(start)
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	p99 := latencies[len(latencies)*99/100]
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "proposals/s")
+	b.ReportMetric(float64(p99.Microseconds()), "p99-us")
+}
+
+func BenchmarkWriteFsyncMode(b *testing.B) {
+	b.Run("strict", func(b *testing.B) {
+		benchmarkWriteFsyncMode(b, config.StrictFsync)
+	})
+	b.Run("relaxed", func(b *testing.B) {
+		benchmarkWriteFsyncMode(b, config.RelaxedFsync)
+	})
+}
+
+// benchmarkRestartTimeToReady measures the time it takes for 32 restarted
+// single replica shards to elect their leaders and to become ready for
+// proposals. Recovering each state machine from its snapshot takes 500ms and
+// each shard has 100 committed entries to replay after the snapshot.
+func benchmarkRestartTimeToReady(b *testing.B, lazy bool) {
+	const shards = 32
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+		b.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			b.Fatalf("%v", err)
+		}
+	}()
+	network := memtransport.NewNetwork()
+	nhc := network.NodeHostConfigs(1, singleNodeHostTestDir, 10)[0]
+	nhc.Expert = getTestExpertConfig(fs)
+	nhc.Expert.TransportFactory = network
+	peers := map[uint64]string{1: nhc.RaftAddress}
+	delay := time.Duration(0)
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &replayTestSM{delay: delay}
+	}
+	start := func() *NodeHost {
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			b.Fatalf("failed to create nodehost %v", err)
+		}
+		for shardID := uint64(1); shardID <= shards; shardID++ {
+			rc := config.Config{
+				ShardID:      shardID,
+				ReplicaID:    1,
+				ElectionRTT:  10,
+				HeartbeatRTT: 1,
+				LazyReplay:   lazy,
+			}
+			if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+				b.Fatalf("failed to start replica %v", err)
+			}
+		}
+		return nh
+	}
+	propose := func(nh *NodeHost, shardID uint64) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := nh.SyncPropose(ctx, nh.GetNoOPSession(shardID), make([]byte, 128))
+		return err
+	}
+	waitReady := func(nh *NodeHost, shardID uint64) {
+		for i := 0; propose(nh, shardID) != nil; i++ {
+			if i == 1000 {
+				b.Fatalf("shard %d not ready", shardID)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	nh := start()
+	for shardID := uint64(1); shardID <= shards; shardID++ {
+		waitReady(nh, shardID)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if _, err := nh.SyncRequestSnapshot(ctx, shardID, DefaultSnapshotOption); err != nil {
+			b.Fatalf("failed to request snapshot %v", err)
+		}
+		cancel()
+		for i := 0; i < 100; i++ {
+			if err := propose(nh, shardID); err != nil {
+				b.Fatalf("failed to propose %v", err)
+			}
+		}
+	}
+	nh.Close()
+	delay = 500 * time.Millisecond
+	var elected time.Duration
+	var ready time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		begin := time.Now()
+		nh := start()
+		for shardID := uint64(1); shardID <= shards; shardID++ {
+			for {
+				_, _, ok, err := nh.GetLeaderID(shardID)
+				if err == nil && ok {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+		elected += time.Since(begin)
+		for shardID := uint64(1); shardID <= shards; shardID++ {
+			waitReady(nh, shardID)
+		}
+		ready += time.Since(begin)
+		b.StopTimer()
+		nh.Close()
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(elected.Milliseconds())/float64(b.N), "elected-ms")
+	b.ReportMetric(float64(ready.Milliseconds())/float64(b.N), "ready-ms")
+}
+
+func BenchmarkRestartTimeToReady(b *testing.B) {
+	b.Run("eager", func(b *testing.B) {
+		benchmarkRestartTimeToReady(b, false)
+	})
+	b.Run("lazy", func(b *testing.B) {
+		benchmarkRestartTimeToReady(b, true)
+	})
+}
+
+// BenchmarkMultiShardContextSwitches measures the context switches per second
+// of a NodeHost running a steady proposal workload across many shards with
+// raft and membership event listeners installed.
+func BenchmarkMultiShardContextSwitches(b *testing.B) {
+	const shardCount = 64
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+		b.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			b.Fatalf("%v", err)
+		}
+	}()
+	network := memtransport.NewNetwork()
+	nhc := network.NodeHostConfigs(1, singleNodeHostTestDir, 10)[0]
+	nhc.Expert = getTestExpertConfig(fs)
+	nhc.Expert.TransportFactory = network
+	nhc.RaftEventListener = &testRaftEventListener{}
+	nh, err := NewNodeHost(nhc)
+	if err != nil {
+		b.Fatalf("failed to create nodehost %v", err)
+	}
+	defer nh.Close()
+	peers := map[uint64]string{1: nhc.RaftAddress}
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &PST{}
+	}
+	for shardID := uint64(1); shardID <= shardCount; shardID++ {
+		rc := config.Config{
+			ShardID:      shardID,
+			ReplicaID:    1,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+		}
+		if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+			b.Fatalf("failed to start replica %v", err)
+		}
+	}
+	propose := func(shardID uint64) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := nh.SyncPropose(ctx, nh.GetNoOPSession(shardID), []byte("data"))
+		return err
+	}
+	for shardID := uint64(1); shardID <= shardCount; shardID++ {
+		for i := 0; propose(shardID) != nil; i++ {
+			if i == 1000 {
+				b.Fatalf("shard %d not ready", shardID)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	var count int64
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	start := time.Now()
+	before, ok := getContextSwitches()
+	for shardID := uint64(1); shardID <= shardCount; shardID++ {
+		wg.Add(1)
+		go func(shardID uint64) {
+			defer wg.Done()
+			for atomic.AddInt64(&count, 1) <= int64(b.N) {
+				if err := propose(shardID); err != nil {
+					b.Errorf("failed to propose %v", err)
+					return
+				}
+			}
+		}(shardID)
+	}
+	wg.Wait()
+	after, _ := getContextSwitches()
+	elapsed := time.Since(start)
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "proposals/s")
+	if ok {
+		b.ReportMetric(float64(after-before)/elapsed.Seconds(), "ctxsw/s")
+		b.ReportMetric(float64(after-before)/float64(b.N), "ctxsw/op")
+	}
+}
@@ -0,0 +1,405 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+const (
+	// defaultBootstrapRetryInterval is the default interval between two polls
+	// of the shard state made by BootstrapShard and JoinShard.
+	defaultBootstrapRetryInterval = 100 * time.Millisecond
+	// bootstrapReadTimeout is the timeout of each membership read made by
+	// BootstrapShard and JoinShard.
+	bootstrapReadTimeout = time.Second
+)
+
+var (
+	// ErrBootstrapMismatch indicates that the membership of the shard
+	// conflicts with the expected members, e.g. the shard has been bootstrapped
+	// with a different initial members map.
+	ErrBootstrapMismatch = errors.New("membership conflicts with expected members")
+)
+
+// BootstrapStage is the stage of bootstrapping or joining a shard.
+type BootstrapStage int
+
+const (
+	// BootstrapDiscovering is the stage in which JoinShard waits for the local
+	// NodeHost to be listed in the membership of the shard known to the
+	// registry.
+	BootstrapDiscovering BootstrapStage = iota
+	// BootstrapStarting is the stage in which the local replica is started.
+	BootstrapStarting
+	// BootstrapWaitingForLeader is the stage in which the local replica waits
+	// for the leader of the shard to be elected.
+	BootstrapWaitingForLeader
+	// BootstrapWaitingForMembers is the stage in which the local replica waits
+	// for all expected members to be seen in the membership of the shard.
+	BootstrapWaitingForMembers
+	// BootstrapCompleted indicates that the leader is known and all expected
+	// members are in the membership of the shard.
+	BootstrapCompleted
+)
+
+var bootstrapStageNames = [...]string{
+	BootstrapDiscovering:       "Discovering",
+	BootstrapStarting:          "Starting",
+	BootstrapWaitingForLeader:  "WaitingForLeader",
+	BootstrapWaitingForMembers: "WaitingForMembers",
+	BootstrapCompleted:         "Completed",
+}
+
+func (s BootstrapStage) String() string {
+	if s < BootstrapDiscovering || s > BootstrapCompleted {
+		return fmt.Sprintf("BootstrapStage(%d)", int(s))
+	}
+	return bootstrapStageNames[s]
+}
+
+// BootstrapOption is the option type used by BootstrapShard and JoinShard.
+type BootstrapOption struct {
+	// Progress is invoked on the calling goroutine each time the observed
+	// progress changes, it is optional.
+	Progress func(BootstrapReport)
+	// RetryInterval is the interval between two polls of the shard state, the
+	// default value of 100 milliseconds is used when it is 0.
+	RetryInterval time.Duration
+}
+
+// BootstrapReport describes the progress of bootstrapping or joining a shard
+// as observed by the local replica.
+type BootstrapReport struct {
+	ShardID   uint64
+	ReplicaID uint64
+	Stage     BootstrapStage
+	// LeaderID and Term are the last known leader and its term, LeaderID is 0
+	// when the leader is not known.
+	LeaderID uint64
+	Term     uint64
+	// Joined are IDs of expected members seen in the membership of the shard,
+	// Missing are IDs of expected members not seen yet. Both are sorted.
+	Joined  []uint64
+	Missing []uint64
+	// Membership is the last membership read from the shard, it is nil when
+	// the membership has not been read yet.
+	Membership *Membership
+	// Elapsed is the time since BootstrapShard or JoinShard was invoked.
+	Elapsed time.Duration
+}
+
+func (r *BootstrapReport) changed(o BootstrapReport) bool {
+	return r.Stage != o.Stage || r.LeaderID != o.LeaderID ||
+		r.Term != o.Term || len(r.Joined) != len(o.Joined)
+}
+
+// BootstrapShard starts the local replica of a new shard as an initial member
+// and waits until a leader is elected and all expected members are seen in
+// the membership of the shard. expected is the initial members map passed to
+// StartReplica, the same map should be used by all initial members, it must
+// include cfg.ReplicaID with the target of the local NodeHost. factory is the
+// state machine factory, it must be a sm.CreateStateMachineFunc,
+// sm.CreateConcurrentStateMachineFunc or sm.CreateOnDiskStateMachineFunc, or
+// a function with the same signature.
+//
+// Initial members can be started in any order and at different times, the
+// leader is elected once a quorum of them is running. BootstrapShard can be
+// invoked again after failures, e.g. on restart, the local replica is not
+// started again when it is already running. ErrBootstrapMismatch is returned
+// when the membership of the shard lists an expected replica ID with a
+// different target, which happens when members of the shard have been
+// bootstrapped with different initial members maps.
+//
+// The last observed progress is returned together with the error when ctx is
+// done before the bootstrap is completed.
+func BootstrapShard(ctx context.Context, nh *NodeHost,
+	shardID uint64, expected map[uint64]Target, factory interface{},
+	cfg config.Config, opt BootstrapOption) (BootstrapReport, error) {
+	b := newBootstrapper(nh, shardID, opt)
+	cfg.ShardID = shardID
+	if target, ok := expected[cfg.ReplicaID]; !ok || target != b.localTarget() {
+		return b.report, errors.Wrapf(ErrInvalidShardSettings,
+			"replica %d of %s not expected", cfg.ReplicaID, nh.ID())
+	}
+	b.expected = expected
+	if err := b.start(ctx, expected, false, factory, cfg); err != nil {
+		return b.report, err
+	}
+	return b.report, b.wait(ctx)
+}
+
+// JoinShard starts the local replica of an existing shard as a new member.
+// Unlike calling StartReplica with join set to true, the replica ID of the
+// local replica and live members of the shard are not required to be known,
+// they are discovered from the registry returned by GetNodeHostRegistry. The
+// local NodeHost must be added to the shard, e.g. by SyncRequestAddReplica
+// invoked on an existing member, JoinShard waits for the addition to be
+// visible in the registry, starts the local replica with the discovered
+// replica ID and role, and waits until the leader is known and the local
+// replica is seen in the membership of the shard.
+//
+// cfg.ReplicaID can be left as 0, ErrBootstrapMismatch is returned when it is
+// set to a value other than the discovered one. ErrInvalidOperation is
+// returned when the NodeHost is not in the DefaultNodeRegistryEnabled mode.
+// See BootstrapShard for details on factory and the returned report.
+func JoinShard(ctx context.Context, nh *NodeHost,
+	shardID uint64, factory interface{},
+	cfg config.Config, opt BootstrapOption) (BootstrapReport, error) {
+	b := newBootstrapper(nh, shardID, opt)
+	r, ok := nh.GetNodeHostRegistry()
+	if !ok {
+		return b.report, errors.Wrapf(ErrInvalidOperation,
+			"DefaultNodeRegistryEnabled not set")
+	}
+	replicaID, role, err := b.discover(ctx, r)
+	if err != nil {
+		return b.report, err
+	}
+	if cfg.ReplicaID != 0 && cfg.ReplicaID != replicaID {
+		return b.report, errors.Wrapf(ErrBootstrapMismatch,
+			"replica ID %d, discovered %d", cfg.ReplicaID, replicaID)
+	}
+	cfg.ShardID = shardID
+	cfg.ReplicaID = replicaID
+	cfg.IsNonVoting = role == NonVoting
+	cfg.IsWitness = role == Witness
+	b.expected = map[uint64]Target{replicaID: b.localTarget()}
+	if err := b.start(ctx, nil, true, factory, cfg); err != nil {
+		return b.report, err
+	}
+	return b.report, b.wait(ctx)
+}
+
+type bootstrapper struct {
+	nh       *NodeHost
+	opt      BootstrapOption
+	started  time.Time
+	expected map[uint64]Target
+	report   BootstrapReport
+}
+
+func newBootstrapper(nh *NodeHost,
+	shardID uint64, opt BootstrapOption) *bootstrapper {
+	if opt.RetryInterval == 0 {
+		opt.RetryInterval = defaultBootstrapRetryInterval
+	}
+	return &bootstrapper{
+		nh:      nh,
+		opt:     opt,
+		started: time.Now(),
+		report:  BootstrapReport{ShardID: shardID},
+	}
+}
+
+func (b *bootstrapper) localTarget() Target {
+	if b.nh.NodeHostConfig().DefaultNodeRegistryEnabled {
+		return b.nh.ID()
+	}
+	return b.nh.RaftAddress()
+}
+
+func (b *bootstrapper) update(r BootstrapReport) {
+	r.Elapsed = time.Since(b.started)
+	changed := b.report.changed(r)
+	b.report = r
+	if changed && b.opt.Progress != nil {
+		b.opt.Progress(r)
+	}
+}
+
+func (b *bootstrapper) sleep(ctx context.Context) error {
+	timer := time.NewTimer(b.opt.RetryInterval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return getContextError(ctx)
+	}
+}
+
+// discover waits for the local NodeHost to be listed in the membership of
+// the shard known to the registry.
+func (b *bootstrapper) discover(ctx context.Context,
+	r INodeHostRegistry) (uint64, ReplicaRole, error) {
+	report := b.report
+	report.Stage = BootstrapDiscovering
+	target := b.localTarget()
+	for {
+		b.update(report)
+		if p, ok := r.GetShardPlacement(report.ShardID); ok {
+			for _, rp := range p.Replicas {
+				if rp.NodeHostID == target {
+					return rp.ReplicaID, rp.Role, nil
+				}
+			}
+		}
+		if err := b.sleep(ctx); err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+func (b *bootstrapper) start(ctx context.Context,
+	initialMembers map[uint64]Target, join bool,
+	factory interface{}, cfg config.Config) error {
+	report := b.report
+	report.ReplicaID = cfg.ReplicaID
+	report.Stage = BootstrapStarting
+	b.update(report)
+	err := startWithFactory(b.nh, initialMembers, join, factory, cfg)
+	if errors.Is(err, ErrShardAlreadyExist) {
+		plog.Infof("%s already started", dn(cfg.ShardID, cfg.ReplicaID))
+		return nil
+	}
+	return err
+}
+
+// wait waits until the leader is known and all expected members are seen in
+// the membership of the shard.
+func (b *bootstrapper) wait(ctx context.Context) error {
+	for {
+		done, err := b.poll(ctx)
+		if err != nil || done {
+			return err
+		}
+		if err := b.sleep(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *bootstrapper) poll(ctx context.Context) (bool, error) {
+	report := b.report
+	leaderID, term, ok, err := b.nh.GetLeaderID(report.ShardID)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		report.Stage = BootstrapWaitingForLeader
+		report.LeaderID = 0
+		b.update(report)
+		return false, nil
+	}
+	report.LeaderID = leaderID
+	report.Term = term
+	rctx, cancel := context.WithTimeout(ctx, bootstrapReadTimeout)
+	m, err := b.nh.SyncGetShardMembership(rctx, report.ShardID)
+	cancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, getContextError(ctx)
+		}
+		if IsTempError(err) {
+			report.Stage = BootstrapWaitingForLeader
+			b.update(report)
+			return false, nil
+		}
+		return false, err
+	}
+	report.Membership = m
+	report.Joined = report.Joined[:0:0]
+	report.Missing = report.Missing[:0:0]
+	for replicaID, target := range b.expected {
+		actual, ok := getMembershipTarget(m, replicaID)
+		if !ok {
+			report.Missing = append(report.Missing, replicaID)
+			continue
+		}
+		if actual != target {
+			b.update(report)
+			return false, errors.Wrapf(ErrBootstrapMismatch,
+				"replica %d is on %s, expected %s", replicaID, actual, target)
+		}
+		report.Joined = append(report.Joined, replicaID)
+	}
+	sort.Slice(report.Joined, func(i, j int) bool {
+		return report.Joined[i] < report.Joined[j]
+	})
+	sort.Slice(report.Missing, func(i, j int) bool {
+		return report.Missing[i] < report.Missing[j]
+	})
+	if len(report.Missing) > 0 {
+		report.Stage = BootstrapWaitingForMembers
+	} else {
+		report.Stage = BootstrapCompleted
+	}
+	b.update(report)
+	return report.Stage == BootstrapCompleted, nil
+}
+
+// getFactory returns the specified state machine factory converted to one of
+// the sm.CreateStateMachineFunc, sm.CreateConcurrentStateMachineFunc and
+// sm.CreateOnDiskStateMachineFunc types, the state machine type created by
+// the factory is also returned. ErrInvalidOperation is returned when the
+// factory is of any other type.
+func getFactory(factory interface{}) (interface{},
+	pb.StateMachineType, error) {
+	switch f := factory.(type) {
+	case func(uint64, uint64) sm.IStateMachine:
+		return sm.CreateStateMachineFunc(f), pb.RegularStateMachine, nil
+	case sm.CreateStateMachineFunc:
+		return f, pb.RegularStateMachine, nil
+	case func(uint64, uint64) sm.IConcurrentStateMachine:
+		return sm.CreateConcurrentStateMachineFunc(f), pb.ConcurrentStateMachine, nil
+	case sm.CreateConcurrentStateMachineFunc:
+		return f, pb.ConcurrentStateMachine, nil
+	case func(uint64, uint64) sm.IOnDiskStateMachine:
+		return sm.CreateOnDiskStateMachineFunc(f), pb.OnDiskStateMachine, nil
+	case sm.CreateOnDiskStateMachineFunc:
+		return f, pb.OnDiskStateMachine, nil
+	}
+	return nil, pb.UnknownStateMachine, errors.Wrapf(ErrInvalidOperation,
+		"unknown state machine factory type %T", factory)
+}
+
+// startWithFactory starts the local replica using the StartReplica variant
+// matching the type of the specified state machine factory.
+func startWithFactory(nh *NodeHost, initialMembers map[uint64]Target,
+	join bool, factory interface{}, cfg config.Config) error {
+	factory, _, err := getFactory(factory)
+	if err != nil {
+		return err
+	}
+	switch f := factory.(type) {
+	case sm.CreateStateMachineFunc:
+		return nh.StartReplica(initialMembers, join, f, cfg)
+	case sm.CreateConcurrentStateMachineFunc:
+		return nh.StartConcurrentReplica(initialMembers, join, f, cfg)
+	case sm.CreateOnDiskStateMachineFunc:
+		return nh.StartOnDiskReplica(initialMembers, join, f, cfg)
+	}
+	panic("not suppose to reach here")
+}
+
+func getMembershipTarget(m *Membership, replicaID uint64) (Target, bool) {
+	for _, members := range []map[uint64]string{m.Nodes,
+		m.NonVotings, m.Witnesses} {
+		if target, ok := members[replicaID]; ok {
+			return target, true
+		}
+	}
+	return "", false
+}
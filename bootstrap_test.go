@@ -0,0 +1,249 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+)
+
+func getBootstrapTestConfig(replicaID uint64) config.Config {
+	return config.Config{
+		ReplicaID:    replicaID,
+		ElectionRTT:  10,
+		HeartbeatRTT: 1,
+		CheckQuorum:  true,
+	}
+}
+
+func TestBootstrapStageString(t *testing.T) {
+	if v := BootstrapWaitingForLeader.String(); v != "WaitingForLeader" {
+		t.Errorf("unexpected name %s", v)
+	}
+	if v := BootstrapStage(100).String(); v != "BootstrapStage(100)" {
+		t.Errorf("unexpected name %s", v)
+	}
+}
+
+func TestBootstrapShardWithStaggeredMembers(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		expected := make(map[uint64]Target)
+		for i := range nhs {
+			expected[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		delays := []time.Duration{0, 500 * time.Millisecond, 2 * time.Second}
+		reports := make([]BootstrapReport, len(nhs))
+		errs := make([]error, len(nhs))
+		stages := make([][]BootstrapStage, len(nhs))
+		var wg sync.WaitGroup
+		for i := range nhs {
+			i := i
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				time.Sleep(delays[i])
+				ctx, cancel := context.WithTimeout(context.Background(),
+					2*lpto(nhs[i]))
+				defer cancel()
+				opt := BootstrapOption{
+					Progress: func(r BootstrapReport) {
+						stages[i] = append(stages[i], r.Stage)
+					},
+					RetryInterval: 10 * time.Millisecond,
+				}
+				reports[i], errs[i] = BootstrapShard(ctx, nhs[i], 1, expected,
+					newCloneTestSM, getBootstrapTestConfig(uint64(i+1)), opt)
+			}()
+		}
+		wg.Wait()
+		for i, r := range reports {
+			if errs[i] != nil {
+				t.Fatalf("member %d failed to bootstrap %v", i+1, errs[i])
+			}
+			if r.Stage != BootstrapCompleted || r.LeaderID == 0 ||
+				r.ReplicaID != uint64(i+1) {
+				t.Errorf("unexpected report %+v", r)
+			}
+			if !reflect.DeepEqual(r.Joined, []uint64{1, 2, 3}) || len(r.Missing) > 0 {
+				t.Errorf("unexpected joined %v, missing %v", r.Joined, r.Missing)
+			}
+			last := stages[i][len(stages[i])-1]
+			if stages[i][0] != BootstrapStarting || last != BootstrapCompleted {
+				t.Errorf("unexpected stages %v", stages[i])
+			}
+		}
+		// member 1 has to wait for member 2 to form a quorum
+		waited := false
+		for _, s := range stages[0] {
+			if s == BootstrapWaitingForLeader {
+				waited = true
+			}
+		}
+		if !waited {
+			t.Errorf("member 1 did not wait for the leader, %v", stages[0])
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(nhs[0]))
+		defer cancel()
+		if _, err := nhs[0].SyncPropose(ctx,
+			nhs[0].GetNoOPSession(1), []byte("a=1")); err != nil {
+			t.Fatalf("failed to propose %v", err)
+		}
+		if v := readCloneTestValue(t, nhs[2], 1, "a"); v != "1" {
+			t.Errorf("unexpected value %s", v)
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
+
+func TestBootstrapShardDetectsMismatchedMembers(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := map[uint64]string{
+			1: memtransport.Address(1),
+			2: memtransport.Address(2),
+		}
+		startCloneTestShard(t, nhs[:2], 1, []uint64{1, 2}, members)
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(nhs[0]))
+		defer cancel()
+		opt := BootstrapOption{RetryInterval: 10 * time.Millisecond}
+		rc := getBootstrapTestConfig(1)
+		expected := map[uint64]Target{
+			1: memtransport.Address(1),
+			2: memtransport.Address(3),
+		}
+		// the shard is already running with a different members map
+		if _, err := BootstrapShard(ctx, nhs[0], 1, expected,
+			newCloneTestSM, rc, opt); !errors.Is(err, ErrBootstrapMismatch) {
+			t.Errorf("unexpected error %v", err)
+		}
+		if _, err := BootstrapShard(ctx, nhs[0], 1, members,
+			newCloneTestSM, rc, opt); err != nil {
+			t.Errorf("failed to bootstrap again %v", err)
+		}
+		notLocal := map[uint64]Target{1: memtransport.Address(2)}
+		if _, err := BootstrapShard(ctx, nhs[0], 1, notLocal,
+			newCloneTestSM, rc, opt); !errors.Is(err, ErrInvalidShardSettings) {
+			t.Errorf("unexpected error %v", err)
+		}
+		if _, err := BootstrapShard(ctx, nhs[2], 2,
+			map[uint64]Target{3: memtransport.Address(3)},
+			"factory", getBootstrapTestConfig(3), opt); !errors.Is(err, ErrInvalidOperation) {
+			t.Errorf("unexpected error %v", err)
+		}
+		if _, err := JoinShard(ctx, nhs[2], 1, newCloneTestSM,
+			getBootstrapTestConfig(0), opt); !errors.Is(err, ErrInvalidOperation) {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
+
+func TestJoinShardDiscoversReplicaFromRegistry(t *testing.T) {
+	fs := vfs.GetTestFS()
+	_ = os.RemoveAll(singleNodeHostTestDir)
+	defer os.RemoveAll(singleNodeHostTestDir)
+	nhids := []string{testNodeHostID1, testNodeHostID2,
+		"123e4567-e89b-12d3-a456-426614174002"}
+	addrs := []string{nodeHostTestAddr1, nodeHostTestAddr2, nodeHostTestAddr3}
+	nhs := make([]*NodeHost, 0)
+	for i := 0; i < 3; i++ {
+		datadir := fs.PathJoin(singleNodeHostTestDir, fmt.Sprintf("nh%d", i+1))
+		nhc := config.NodeHostConfig{
+			NodeHostDir:                datadir,
+			RTTMillisecond:             getRTTMillisecond(fs, datadir),
+			RaftAddress:                addrs[i],
+			NodeHostID:                 nhids[i],
+			DefaultNodeRegistryEnabled: true,
+			Expert: config.ExpertConfig{
+				FS:                      fs,
+				TestGossipProbeInterval: 50 * time.Millisecond,
+			},
+			Gossip: config.GossipConfig{
+				BindAddress:      fmt.Sprintf("127.0.0.1:%d", 25001+i),
+				AdvertiseAddress: fmt.Sprintf("127.0.0.1:%d", 25001+i),
+				Seed:             []string{"127.0.0.1:25001", "127.0.0.1:25002"},
+			},
+		}
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			t.Fatalf("failed to create nh, %v", err)
+		}
+		defer nh.Close()
+		nhs = append(nhs, nh)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	opt := BootstrapOption{RetryInterval: 10 * time.Millisecond}
+	// the joining NodeHost is started before it is added to the shard
+	var wg sync.WaitGroup
+	var joined BootstrapReport
+	var joinErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		joined, joinErr = JoinShard(ctx, nhs[2], 1, newCloneTestSM,
+			getBootstrapTestConfig(0), opt)
+	}()
+	expected := map[uint64]Target{1: nhids[0], 2: nhids[1]}
+	errs := make([]error, 2)
+	for i := 0; i < 2; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Duration(i) * 500 * time.Millisecond)
+			_, errs[i] = BootstrapShard(ctx, nhs[i], 1, expected,
+				newCloneTestSM, getBootstrapTestConfig(uint64(i+1)), opt)
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		waitForLeaderToBeElected(t, nhs[i], 1)
+	}
+	if err := nhs[0].SyncRequestAddReplica(ctx, 1, 3, nhids[2], 0); err != nil {
+		t.Fatalf("failed to add replica %v", err)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("member %d failed to bootstrap %v", i+1, err)
+		}
+	}
+	if joinErr != nil {
+		t.Fatalf("failed to join %v", joinErr)
+	}
+	if joined.ReplicaID != 3 || joined.Stage != BootstrapCompleted ||
+		!reflect.DeepEqual(joined.Joined, []uint64{3}) {
+		t.Errorf("unexpected report %+v", joined)
+	}
+	if _, err := nhs[0].SyncPropose(ctx,
+		nhs[0].GetNoOPSession(1), []byte("a=1")); err != nil {
+		t.Fatalf("failed to propose %v", err)
+	}
+	if v := readCloneTestValue(t, nhs[2], 1, "a"); v != "1" {
+		t.Errorf("unexpected value %s", v)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+var (
+	// ErrStalenessBoundExceeded indicates that the local replica can not serve
+	// the bounded staleness read as it has not been in contact with the leader
+	// recently enough, see NodeHost.ReadBoundedStale for details.
+	ErrStalenessBoundExceeded = errors.New("staleness bound exceeded")
+)
+
+// BoundedStaleReadOption is the option type used by
+// ReadBoundedStaleWithOption.
+type BoundedStaleReadOption struct {
+	// FallbackToLinearizable indicates whether a linearizable read should be
+	// performed when the local replica can not guarantee the staleness bound.
+	// ErrStalenessBoundExceeded is returned in that case when it is false.
+	FallbackToLinearizable bool
+}
+
+// ReadBoundedStale queries the local replica of the specified shard with its
+// staleness bounded by maxLag. The query is served by the local replica when
+// it received a heartbeat message from the leader within maxLag and it has
+// applied the commit index of the leader at the time that heartbeat message
+// was sent. A replica lagging behind the leader is thus not considered as
+// fresh until it catches up. ErrStalenessBoundExceeded is returned otherwise.
+// Queries made on the leader are always served by linearizable reads.
+//
+// Heartbeat messages are sent every HeartbeatRTT ticks, maxLag is expected to
+// be a few times larger than that interval. Quiesced replicas don't exchange
+// heartbeat messages, the bound is exceeded once the shard is quiesced. It is
+// also always exceeded when the leader runs a Dragonboat version that doesn't
+// include its commit index in heartbeat messages.
+// config.Config.CheckQuorum should be enabled so a leader partitioned from the
+// majority of the shard steps down and stops sending heartbeat messages. The
+// specified context parameter must have the timeout value set when a
+// linearizable read is performed.
+func (nh *NodeHost) ReadBoundedStale(ctx context.Context, shardID uint64,
+	maxLag time.Duration, query interface{}) (interface{}, error) {
+	return nh.ReadBoundedStaleWithOption(ctx,
+		shardID, maxLag, query, BoundedStaleReadOption{})
+}
+
+// ReadBoundedStaleWithOption is similar to ReadBoundedStale, it allows the
+// caller to specify the BoundedStaleReadOption.
+func (nh *NodeHost) ReadBoundedStaleWithOption(ctx context.Context,
+	shardID uint64, maxLag time.Duration, query interface{},
+	opt BoundedStaleReadOption) (interface{}, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nil, nh.shardNotFound(shardID)
+	}
+	if !n.initialized() {
+		return nil, ErrShardNotInitialized
+	}
+	if n.isWitness() {
+		return nil, ErrInvalidOperation
+	}
+	if !n.isLeader() {
+		if n.freshWithin(maxLag) {
+			data, err := n.lookup(query)
+			if errors.Is(err, rsm.ErrShardClosed) {
+				return nil, ErrShardClosed
+			}
+			return data, err
+		}
+		if !opt.FallbackToLinearizable {
+			return nil, ErrStalenessBoundExceeded
+		}
+	}
+	return nh.SyncRead(ctx, shardID, query)
+}
+
+// leaderContact is a heartbeat message received from the leader, commit is
+// the uncapped commit index of the leader.
+type leaderContact struct {
+	commit uint64
+	time   int64
+}
+
+// observeHeartbeat records the time of the heartbeat message received from
+// the current leader. It is invoked on the message path, the recorded time is
+// only used once the commit index of the leader carried by the message has
+// been applied. The Commit field of the heartbeat message is capped by the
+// replication progress of the local replica, the uncapped LeaderCommit is used
+// instead, heartbeat messages without it are ignored.
+func (n *node) observeHeartbeat(m pb.Message) {
+	v := n.leaderInfo.Load()
+	if v == nil {
+		return
+	}
+	li := v.(*leaderInfo)
+	if li.leaderID != m.From || li.term != m.Term || m.LeaderCommit == 0 {
+		return
+	}
+	commit := m.LeaderCommit
+	now := n.clock().UnixNano()
+	if c := n.getLeaderContact(); c != nil && c.commit <= n.appliedIndex &&
+		c.time > atomic.LoadInt64(&n.freshAt) {
+		atomic.StoreInt64(&n.freshAt, c.time)
+	}
+	if commit <= n.appliedIndex {
+		atomic.StoreInt64(&n.freshAt, now)
+		return
+	}
+	n.leaderContact.Store(&leaderContact{commit: commit, time: now})
+}
+
+func (n *node) getLeaderContact() *leaderContact {
+	v := n.leaderContact.Load()
+	if v == nil {
+		return nil
+	}
+	return v.(*leaderContact)
+}
+
+// freshWithin returns a boolean value indicating whether the applied state of
+// the replica is known to be no staler than the specified duration.
+func (n *node) freshWithin(maxLag time.Duration) bool {
+	fresh := atomic.LoadInt64(&n.freshAt)
+	if c := n.getLeaderContact(); c != nil && c.time > fresh &&
+		c.commit <= n.sm.GetLastApplied() {
+		fresh = c.time
+	}
+	if fresh == 0 {
+		return false
+	}
+	return time.Duration(n.clock().UnixNano()-fresh) <= maxLag
+}
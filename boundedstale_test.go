@@ -0,0 +1,194 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/transport"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func proposeBoundedStaleTestValue(t *testing.T, nh *NodeHost, value string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+	defer cancel()
+	if _, err := nh.SyncPropose(ctx,
+		nh.GetNoOPSession(1), []byte("k="+value)); err != nil {
+		t.Fatalf("failed to propose %v", err)
+	}
+}
+
+// waitForBoundedStaleTestValue waits until the bounded staleness read made on
+// the specified NodeHost returns the expected value.
+func waitForBoundedStaleTestValue(t *testing.T, nh *NodeHost,
+	maxLag time.Duration, opt BoundedStaleReadOption, value string) {
+	t.Helper()
+	for i := 0; ; i++ {
+		if i > 200 {
+			t.Fatalf("failed to read %s", value)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+		v, err := nh.ReadBoundedStaleWithOption(ctx, 1, maxLag, "k", opt)
+		cancel()
+		if err == nil && v.(string) == value {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBoundedStaleReadIsEnforcedOnPartitionedFollower(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := make(map[uint64]string)
+		for i := range nhs {
+			members[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		startCloneTestShard(t, nhs, 1, []uint64{1, 2, 3}, members)
+		leaderID, _, ok, err := nhs[0].GetLeaderID(1)
+		if err != nil || !ok {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		leader := nhs[leaderID-1]
+		replicaID := leaderID%uint64(len(nhs)) + 1
+		follower := nhs[replicaID-1]
+		heartbeat := time.Duration(follower.NodeHostConfig().RTTMillisecond) *
+			time.Millisecond
+		maxLag := 20 * heartbeat
+		fallback := BoundedStaleReadOption{FallbackToLinearizable: true}
+		proposeBoundedStaleTestValue(t, leader, "v1")
+		waitForBoundedStaleTestValue(t, follower,
+			maxLag, BoundedStaleReadOption{}, "v1")
+		var others []string
+		for i := range nhs {
+			if uint64(i+1) != replicaID {
+				others = append(others, memtransport.Address(i+1))
+			}
+		}
+		network.Partition([]string{memtransport.Address(int(replicaID))}, others)
+		proposeBoundedStaleTestValue(t, leader, "v2")
+		time.Sleep(maxLag + 5*heartbeat)
+		ctx, cancel := context.WithTimeout(context.Background(), pto(follower))
+		defer cancel()
+		if _, err := follower.ReadBoundedStale(ctx,
+			1, maxLag, "k"); !errors.Is(err, ErrStalenessBoundExceeded) {
+			t.Fatalf("staleness bound not enforced, %v", err)
+		}
+		// the linearizable read can not be completed without the leader
+		if v, err := follower.ReadBoundedStaleWithOption(ctx,
+			1, maxLag, "k", fallback); err == nil {
+			t.Fatalf("unexpectedly read %v", v)
+		}
+		// reads are still served locally when the bound is large enough
+		v, err := follower.ReadBoundedStale(ctx, 1, time.Hour, "k")
+		if err != nil {
+			t.Fatalf("failed to read %v", err)
+		}
+		if v.(string) != "v1" {
+			t.Errorf("unexpected value %s", v)
+		}
+		network.Heal()
+		waitForBoundedStaleTestValue(t, follower, maxLag, fallback, "v2")
+		waitForBoundedStaleTestValue(t, follower,
+			maxLag, BoundedStaleReadOption{}, "v2")
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
+
+func TestBoundedStaleReadIsEnforcedOnLaggingFollower(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := make(map[uint64]string)
+		for i := range nhs {
+			members[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		startCloneTestShard(t, nhs, 1, []uint64{1, 2, 3}, members)
+		leaderID, _, ok, err := nhs[0].GetLeaderID(1)
+		if err != nil || !ok {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		leader := nhs[leaderID-1]
+		replicaID := leaderID%uint64(len(nhs)) + 1
+		follower := nhs[replicaID-1]
+		heartbeat := time.Duration(follower.NodeHostConfig().RTTMillisecond) *
+			time.Millisecond
+		maxLag := 20 * heartbeat
+		proposeBoundedStaleTestValue(t, leader, "v1")
+		waitForBoundedStaleTestValue(t, follower,
+			maxLag, BoundedStaleReadOption{}, "v1")
+		// the follower keeps receiving heartbeat messages from the leader, but
+		// not the entries
+		lagging := uint32(1)
+		tt := leader.transport.(*transport.Transport)
+		tt.SetPreSendBatchHook(func(b pb.MessageBatch) (pb.MessageBatch, bool) {
+			if atomic.LoadUint32(&lagging) == 0 {
+				return b, true
+			}
+			requests := make([]pb.Message, 0, len(b.Requests))
+			for _, req := range b.Requests {
+				if req.To != replicaID || req.Type != pb.Replicate {
+					requests = append(requests, req)
+				}
+			}
+			b.Requests = requests
+			return b, true
+		})
+		proposeBoundedStaleTestValue(t, leader, "v2")
+		time.Sleep(maxLag + 5*heartbeat)
+		ctx, cancel := context.WithTimeout(context.Background(), pto(follower))
+		defer cancel()
+		if v, err := follower.ReadBoundedStale(ctx,
+			1, maxLag, "k"); !errors.Is(err, ErrStalenessBoundExceeded) {
+			t.Fatalf("staleness bound not enforced, %v, %v", v, err)
+		}
+		atomic.StoreUint32(&lagging, 0)
+		waitForBoundedStaleTestValue(t, follower,
+			maxLag, BoundedStaleReadOption{}, "v2")
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
+
+func TestBoundedStaleReadOnLeaderIsLinearizable(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := map[uint64]string{1: memtransport.Address(1)}
+		startCloneTestShard(t, nhs, 1, []uint64{1}, members)
+		nh := nhs[0]
+		proposeBoundedStaleTestValue(t, nh, "v1")
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+		defer cancel()
+		// no heartbeat is ever received by the only replica of the shard
+		v, err := nh.ReadBoundedStale(ctx, 1, time.Nanosecond, "k")
+		if err != nil {
+			t.Fatalf("failed to read %v", err)
+		}
+		if v.(string) != "v1" {
+			t.Errorf("unexpected value %s", v)
+		}
+		if _, err := nh.ReadBoundedStale(ctx,
+			2, time.Second, "k"); !errors.Is(err, ErrShardNotFound) {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	memTransportNodeHostTest(t, 1, tf, fs)
+}
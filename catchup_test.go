@@ -0,0 +1,153 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func getPeerProgress(t *testing.T,
+	nh *NodeHost, replicaID uint64) (PeerProgress, uint64) {
+	d := mustDumpRaftState(t, nh)
+	for _, p := range d.Peers {
+		if p.ReplicaID == replicaID {
+			return p, d.LastIndex
+		}
+	}
+	t.Fatalf("replica %d not found in %+v", replicaID, d.Peers)
+	return PeerProgress{}, 0
+}
+
+func TestCatchupReplicationIsThrottled(t *testing.T) {
+	const catchupBytesPerSecond = 256 * 1024
+	const lagEntries = 16
+	const proposals = 256
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		peers := make(map[uint64]string)
+		for i := range nhs {
+			peers[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		for i, nh := range nhs {
+			rc := config.Config{
+				ShardID:                   1,
+				ReplicaID:                 uint64(i + 1),
+				ElectionRTT:               10,
+				HeartbeatRTT:              1,
+				CheckQuorum:               true,
+				PreVote:                   true,
+				MaxCatchupBytesPerSecond:  catchupBytesPerSecond,
+				CatchupThrottleLagEntries: lagEntries,
+			}
+			createSM := func(uint64, uint64) sm.IStateMachine {
+				return &PST{}
+			}
+			if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+				t.Fatalf("failed to start replica %v", err)
+			}
+		}
+		for _, nh := range nhs {
+			waitForLeaderToBeElected(t, nh, 1)
+		}
+		leaderID, _, _, err := nhs[0].GetLeaderID(1)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		leader := int(leaderID - 1)
+		laggard := (leader + 1) % len(nhs)
+		laggardID := uint64(laggard + 1)
+		var others []string
+		for i := range nhs {
+			if i != laggard {
+				others = append(others, memtransport.Address(i+1))
+			}
+		}
+		network.Partition([]string{memtransport.Address(laggard + 1)}, others)
+		for i := 0; i < proposals; i++ {
+			if !makeTestProposal(nhs[leader], 100) {
+				t.Fatalf("failed to make proposal")
+			}
+		}
+		initial, lastIndex := getPeerProgress(t, nhs[leader], laggardID)
+		network.Heal()
+		// reconnection takes time, the catch-up starts when the laggard makes
+		// its first progress
+		var start time.Time
+		throttled := false
+		maxLatency := time.Duration(0)
+		session := nhs[leader].GetNoOPSession(1)
+		for i := 0; ; i++ {
+			p, _ := getPeerProgress(t, nhs[leader], laggardID)
+			if p.Throttled {
+				throttled = true
+			}
+			if start.IsZero() && p.Match > initial.Match {
+				start = time.Now()
+			}
+			if p.Match >= lastIndex {
+				break
+			}
+			if i > 1000 {
+				t.Fatalf("laggard failed to catch up, %+v", p)
+			}
+			// proposals are committed by the leader and the healthy follower
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[leader]))
+			proposed := time.Now()
+			_, err := nhs[leader].SyncPropose(ctx, session, make([]byte, 16))
+			cancel()
+			if err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+			if latency := time.Since(proposed); latency > maxLatency {
+				maxLatency = latency
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+		elapsed := time.Since(start)
+		if !throttled {
+			t.Errorf("laggard not throttled")
+		}
+		// 1KB proposals, half of the expected duration is allowed as the bucket
+		// starts full and the throttling stops when lagEntries are left
+		throttledBytes := (proposals - lagEntries) * 1024
+		minElapsed := time.Duration(throttledBytes) * time.Second /
+			catchupBytesPerSecond / 2
+		if elapsed < minElapsed {
+			t.Errorf("caught up in %v, want at least %v", elapsed, minElapsed)
+		}
+		if maxLatency > minElapsed/2 {
+			t.Errorf("max proposal latency %v during catch-up", maxLatency)
+		}
+		// the throttled state is refreshed on the next tick
+		for i := 0; ; i++ {
+			p, _ := getPeerProgress(t, nhs[leader], laggardID)
+			if !p.Throttled {
+				break
+			}
+			if i > 200 {
+				t.Fatalf("laggard still throttled, %+v", p)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
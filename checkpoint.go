@@ -0,0 +1,238 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/logdb"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	// defaultCheckpointMaxPause is the default max duration LogDB writes are
+	// paused for checkpointing each LogDB shard.
+	defaultCheckpointMaxPause = 5 * time.Second
+)
+
+var (
+	// ErrCheckpointNotSupported indicates that the LogDB used by the NodeHost
+	// can not be checkpointed.
+	ErrCheckpointNotSupported = logdb.ErrCheckpointNotSupported
+	// ErrCheckpointTimeout indicates that a LogDB shard could not be
+	// checkpointed within the max allowed pause of its writes.
+	ErrCheckpointTimeout = logdb.ErrCheckpointTimeout
+	// ErrCheckpointDirExists indicates that the target directory of the
+	// checkpoint already exists.
+	ErrCheckpointDirExists = errors.New("checkpoint directory already exists")
+)
+
+// CheckpointOptions is the option type used by NodeHost.Checkpoint.
+type CheckpointOptions struct {
+	// MaxPause is the max duration writes to each LogDB shard can be paused
+	// when the LogDB shard is being checkpointed, Checkpoint fails with
+	// ErrCheckpointTimeout when it is exceeded. The default value of 5 seconds
+	// is used when MaxPause is 0.
+	MaxPause time.Duration
+}
+
+// Checkpoint creates a crash consistent copy of the NodeHost directory in
+// targetDir while the NodeHost keeps running. LogDB shards are checkpointed
+// one by one using the checkpoint facility of the storage engine, writes to
+// each LogDB shard are briefly paused while it is being checkpointed together
+// with the snapshot directories of replicas stored in it. Files are hard
+// linked when the filesystem allows, they are copied otherwise.
+//
+// targetDir must not exist, it is removed when Checkpoint fails. The copy
+// always keeps its WAL together with the rest of the LogDB, it can be used as
+// the NodeHostDir of a NodeHost with an empty WALDir on another host once the
+// RelocateNodeHostDir function in the tools package is invoked to update the
+// recorded RaftAddress and hostname. Data of on disk state machines is not
+// managed by the NodeHost and it is not included in the copy, files exported
+// by state machines into snapshots are still referenced using their paths in
+// the NodeHost directory. ErrCheckpointNotSupported is returned when the LogDB
+// is not the built-in LogDB.
+func (nh *NodeHost) Checkpoint(ctx context.Context,
+	targetDir string, opts CheckpointOptions) (err error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	ldb, ok := nh.mu.logdb.(*logdb.ShardedDB)
+	if !ok {
+		return ErrCheckpointNotSupported
+	}
+	maxPause := opts.MaxPause
+	if maxPause == 0 {
+		maxPause = defaultCheckpointMaxPause
+	}
+	fs := nh.fs
+	exist, err := fileutil.Exist(targetDir, fs)
+	if err != nil {
+		return err
+	}
+	if exist {
+		return ErrCheckpointDirExists
+	}
+	cfg := nh.nhConfig
+	cfg.NodeHostDir = targetDir
+	cfg.WALDir = ""
+	env, err := server.NewEnv(cfg, fs)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, env.Close())
+		if err != nil {
+			if rerr := fs.RemoveAll(targetDir); rerr != nil {
+				plog.Errorf("failed to remove %s, %v", targetDir, rerr)
+			}
+		}
+	}()
+	did := cfg.GetDeploymentID()
+	dir, _, err := env.CreateNodeHostDir(did)
+	if err != nil {
+		return err
+	}
+	if err := nh.env.CopyFlagFiles(targetDir); err != nil {
+		return err
+	}
+	for p := uint64(0); p < ldb.ShardCount(); p++ {
+		if ctx.Err() != nil {
+			return getContextError(ctx)
+		}
+		paused := func() error {
+			return nh.checkpointSnapshots(ldb, env, p)
+		}
+		start := time.Now()
+		if err := ldb.Checkpoint(p, fs.PathJoin(dir,
+			fmt.Sprintf("logdb-%d", p)), maxPause, paused); err != nil {
+			return err
+		}
+		plog.Infof("%s checkpointed LogDB shard %d, paused for %v",
+			nh.describe(), p, time.Since(start))
+	}
+	return fileutil.SyncDir(dir, fs)
+}
+
+// checkpointSnapshots copies the snapshot directories of all replicas stored
+// in the specified LogDB shard. It is invoked when writes to the LogDB shard
+// are paused, the latest snapshot recorded in the LogDB can not be removed.
+func (nh *NodeHost) checkpointSnapshots(ldb *logdb.ShardedDB,
+	env *server.Env, p uint64) error {
+	nodes, err := ldb.ListNodeInfo()
+	if err != nil {
+		return err
+	}
+	for _, ni := range nodes {
+		if ldb.GetPartitionID(ni.ShardID) != p {
+			continue
+		}
+		if err := nh.checkpointReplicaSnapshots(ldb, env, ni); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (nh *NodeHost) checkpointReplicaSnapshots(ldb *logdb.ShardedDB,
+	env *server.Env, ni raftio.NodeInfo) error {
+	fs := nh.fs
+	did := nh.nhConfig.GetDeploymentID()
+	src := nh.env.GetSnapshotDir(did, ni.ShardID, ni.ReplicaID)
+	exist, err := fileutil.Exist(src, fs)
+	if err != nil || !exist {
+		return err
+	}
+	if err := env.CreateSnapshotDir(did, ni.ShardID, ni.ReplicaID); err != nil {
+		return err
+	}
+	dst := env.GetSnapshotDir(did, ni.ShardID, ni.ReplicaID)
+	// flag files, e.g. the one marking the directory as removed
+	names, err := fs.List(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fi, err := fs.Stat(fs.PathJoin(src, name))
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			if err := vfs.Copy(fs,
+				fs.PathJoin(src, name), fs.PathJoin(dst, name)); err != nil {
+				return err
+			}
+		}
+	}
+	ss, err := ldb.GetSnapshot(ni.ShardID, ni.ReplicaID)
+	if err != nil {
+		return err
+	}
+	if !pb.IsEmptySnapshot(ss) {
+		name := server.GetSnapshotDirName(ss.Index)
+		ssdir := fs.PathJoin(src, name)
+		exist, err := fileutil.Exist(ssdir, fs)
+		if err != nil {
+			return err
+		}
+		if exist {
+			if err := linkOrCopyDir(ssdir, fs.PathJoin(dst, name), fs); err != nil {
+				return err
+			}
+		}
+	}
+	return fileutil.SyncDir(dst, fs)
+}
+
+// linkOrCopyDir recreates the src directory as dst with all its files hard
+// linked or copied.
+func linkOrCopyDir(src string, dst string, fs vfs.IFS) error {
+	if err := fileutil.Mkdir(dst, fs); err != nil {
+		return err
+	}
+	names, err := fs.List(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fp := fs.PathJoin(src, name)
+		fi, err := fs.Stat(fp)
+		if vfs.IsNotExist(err) {
+			// temporary files, e.g. the one created when shrinking the snapshot
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			err = linkOrCopyDir(fp, fs.PathJoin(dst, name), fs)
+		} else {
+			err = vfs.LinkOrCopy(fs, fp, fs.PathJoin(dst, name))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return fileutil.SyncDir(dst, fs)
+}
@@ -0,0 +1,158 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	"github.com/lni/dragonboat/v4/tools"
+)
+
+func TestCheckpointCanBeOpenedOnNewAddress(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := map[uint64]string{1: memtransport.Address(1)}
+		startCloneTestShard(t, nhs, 1, []uint64{1}, members)
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(nhs[0]))
+		defer cancel()
+		// the workload sets keys k1, k2, k3... one by one, completed counts the
+		// number of acknowledged proposals
+		var completed uint64
+		stopc := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 1; ; i++ {
+				select {
+				case <-stopc:
+					return
+				default:
+				}
+				cmd := fmt.Sprintf("k%d=%d", i, i)
+				if _, err := nhs[0].SyncPropose(ctx,
+					nhs[0].GetNoOPSession(1), []byte(cmd)); err != nil {
+					t.Errorf("failed to propose %v", err)
+					return
+				}
+				atomic.StoreUint64(&completed, uint64(i))
+				if i == 20 {
+					if _, err := nhs[0].SyncRequestSnapshot(ctx,
+						1, SnapshotOption{}); err != nil {
+						t.Errorf("failed to request snapshot %v", err)
+						return
+					}
+				}
+			}
+		}()
+		for atomic.LoadUint64(&completed) < 50 {
+			waitForTestLastApplied(t, nhs[0], getTestLastApplied(nhs[0])+1)
+		}
+		target := fs.PathJoin(singleNodeHostTestDir, "checkpoint")
+		// a pause that can never be met
+		if err := nhs[0].Checkpoint(ctx, target,
+			CheckpointOptions{MaxPause: 1}); !errors.Is(err, ErrCheckpointTimeout) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if exist, err := fileutil.Exist(target, fs); err != nil || exist {
+			t.Fatalf("target dir not removed, %t, %v", exist, err)
+		}
+		before := atomic.LoadUint64(&completed)
+		if err := nhs[0].Checkpoint(ctx, target, CheckpointOptions{}); err != nil {
+			t.Fatalf("checkpoint failed %v", err)
+		}
+		after := atomic.LoadUint64(&completed)
+		if err := nhs[0].Checkpoint(ctx,
+			target, CheckpointOptions{}); !errors.Is(err, ErrCheckpointDirExists) {
+			t.Errorf("unexpected error %v", err)
+		}
+		close(stopc)
+		wg.Wait()
+		nhc := nhs[0].NodeHostConfig()
+		nhc.NodeHostDir = target
+		nhc.WALDir = ""
+		nhc.RaftAddress = memtransport.Address(2)
+		if _, err := NewNodeHost(nhc); !errors.Is(err, server.ErrNotOwner) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if err := tools.RelocateNodeHostDir(nhc); err != nil {
+			t.Fatalf("failed to relocate %v", err)
+		}
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			t.Fatalf("failed to open checkpoint %v", err)
+		}
+		defer nh.Close()
+		if nh.ID() != nhs[0].ID() {
+			t.Errorf("NodeHostID %s, want %s", nh.ID(), nhs[0].ID())
+		}
+		ss, err := nh.mu.logdb.GetSnapshot(1, 1)
+		if err != nil {
+			t.Fatalf("failed to get snapshot %v", err)
+		}
+		did := nhc.GetDeploymentID()
+		ssdir := fs.PathJoin(nh.env.GetSnapshotDir(did, 1, 1),
+			server.GetSnapshotDirName(ss.Index))
+		if exist, err := fileutil.Exist(ssdir, fs); ss.Index == 0 || err != nil || !exist {
+			t.Fatalf("snapshot %d not in checkpoint, %v", ss.Index, err)
+		}
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    1,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
+		}
+		if err := nh.StartReplica(nil, false, newCloneTestSM, rc); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+		waitForLeaderToBeElected(t, nh, 1)
+		// the copy is a prefix of the workload including all proposals
+		// acknowledged before the checkpoint started, the proposal in flight
+		// when the checkpoint completed might be included as well
+		count := uint64(0)
+		for i := uint64(1); i <= after+2; i++ {
+			v := readCloneTestValue(t, nh, 1, fmt.Sprintf("k%d", i))
+			if v == "" {
+				break
+			}
+			if v != fmt.Sprintf("%d", i) {
+				t.Fatalf("key k%d, value %s", i, v)
+			}
+			count = i
+		}
+		if count < before || count > after+1 {
+			t.Errorf("copy has %d keys, want [%d, %d]", count, before, after+1)
+		}
+		for i := count + 1; i <= after+2; i++ {
+			if v := readCloneTestValue(t,
+				nh, 1, fmt.Sprintf("k%d", i)); v != "" {
+				t.Errorf("key k%d found after a missing key", i)
+			}
+		}
+	}
+	memTransportNodeHostTest(t, 1, tf, fs)
+}
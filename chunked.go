@@ -0,0 +1,99 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+)
+
+const (
+	// chunkProposalWindow is the max number of chunks of a chunked proposal not
+	// yet known to be committed.
+	chunkProposalWindow = 8
+)
+
+// proposeChunked makes the proposal, payloads larger than the
+// MaxEntryChunkBytes of the shard are proposed as chunk entries followed by a
+// manifest entry made with the specified client session. The manifest is only
+// proposed once all chunks are committed, the returned RequestState is the
+// one of the manifest.
+func (nh *NodeHost) proposeChunked(ctx context.Context, s *client.Session,
+	cmd []byte, timeout time.Duration) (*RequestState, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getShard(s.ShardID)
+	if !ok {
+		return nil, nh.shardNotFound(s.ShardID)
+	}
+	if !n.chunked(len(cmd)) {
+		return nh.propose(ctx, s, cmd, timeout)
+	}
+	if !n.supportClientSession() && !s.IsNoOPSession() {
+		panic("IOnDiskStateMachine based nodes must use NoOPSession")
+	}
+	if !s.ValidForProposal(n.shardID) {
+		return nil, ErrInvalidSession
+	}
+	random := nh.env.GetRandomSource()
+	ct := rsm.ToDioType(n.config.EntryCompressionType)
+	chunks, manifest := rsm.GetChunked(ct,
+		random.Uint64(), cmd, n.config.MaxEntryChunkBytes)
+	cs := client.NewNoOPSession(s.ShardID, random)
+	tick := nh.getTimeoutTick(timeout)
+	pending := make([]*RequestState, 0, chunkProposalWindow)
+	defer func() {
+		// chunks not known to be committed are abandoned on failure
+		for _, rs := range pending {
+			rs.abandoned.set()
+		}
+	}()
+	committed := func() error {
+		rs := pending[0]
+		pending = pending[1:]
+		_, err := getCommittedEntry(ctx, rs)
+		return err
+	}
+	for _, c := range chunks {
+		if len(pending) == chunkProposalWindow {
+			if err := committed(); err != nil {
+				return nil, err
+			}
+		}
+		rs, err := n.proposeEncoded(ctx, cs, c, tick)
+		nh.engine.setStepReady(s.ShardID)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, rs)
+	}
+	for len(pending) > 0 {
+		if err := committed(); err != nil {
+			return nil, err
+		}
+	}
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return nil, ErrTimeout
+	}
+	rs, err := n.proposeEncoded(ctx, s, manifest, nh.getTimeoutTick(timeout))
+	nh.engine.setStepReady(s.ShardID)
+	return rs, err
+}
@@ -0,0 +1,274 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/utils/dio"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+)
+
+const (
+	chunkTestChunkSize = 1024
+)
+
+func getChunkTestPayload(value string) []byte {
+	return []byte("k=" + strings.Repeat(value, 10*chunkTestChunkSize))
+}
+
+// proposeChunkTestEntries proposes the encoded chunk entries using the local
+// replica of shard 1 and waits for them to be committed.
+func proposeChunkTestEntries(t *testing.T,
+	nh *NodeHost, session *client.Session, chunks [][]byte) {
+	t.Helper()
+	for _, c := range chunks {
+		rs := proposeChunkTestEntry(t, nh, session, c)
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+		_, err := getCommittedEntry(ctx, rs)
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to commit chunk %v", err)
+		}
+	}
+}
+
+func proposeChunkTestEntry(t *testing.T,
+	nh *NodeHost, session *client.Session, cmd []byte) *RequestState {
+	t.Helper()
+	n, ok := nh.getShard(1)
+	if !ok {
+		t.Fatalf("failed to get node")
+	}
+	rs, err := n.proposeEncoded(context.Background(),
+		session, cmd, nh.getTimeoutTick(pto(nh)))
+	if err != nil {
+		t.Fatalf("failed to propose %v", err)
+	}
+	nh.engine.setStepReady(1)
+	return rs
+}
+
+func getChunkTestManifestResult(t *testing.T,
+	nh *NodeHost, session *client.Session, manifest []byte) error {
+	t.Helper()
+	rs := proposeChunkTestEntry(t, nh, session, manifest)
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+	defer cancel()
+	_, err := getRequestResult(ctx, rs)
+	return err
+}
+
+// hasSnapshotChunkStreams returns a boolean value indicating whether chunked
+// proposals are saved in the latest snapshot of the local replica.
+func hasSnapshotChunkStreams(t *testing.T, nh *NodeHost) bool {
+	t.Helper()
+	ss, err := nh.mu.logdb.GetSnapshot(1, 1)
+	if err != nil {
+		t.Fatalf("failed to get snapshot %v", err)
+	}
+	reader, header, err := rsm.NewSnapshotReader(ss.Filepath, nh.fs)
+	if err != nil {
+		t.Fatalf("failed to open snapshot %v", err)
+	}
+	dr := dio.NewDecompressor(rsm.ToDioType(header.CompressionType), reader)
+	defer func() {
+		if err := dr.Close(); err != nil {
+			t.Fatalf("failed to close %v", err)
+		}
+	}()
+	sessions := rsm.NewSessionManager()
+	if err := sessions.LoadSessions(dr, rsm.SSVersion(header.Version)); err != nil {
+		t.Fatalf("failed to load sessions %v", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := sessions.SaveSessions(buf); err != nil {
+		t.Fatalf("failed to save sessions %v", err)
+	}
+	// no client session is registered in tests
+	return !bytes.Equal(buf.Bytes(), rsm.GetEmptyLRUSession())
+}
+
+func TestLargeProposalIsChunked(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		createSM: newCloneTestSM,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.MaxEntryChunkBytes = chunkTestChunkSize
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			payload := getChunkTestPayload("v")
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			n, ok := nh.getShard(1)
+			if !ok {
+				t.Fatalf("failed to get node")
+			}
+			index := n.sm.GetLastApplied()
+			r, err := nh.SyncPropose(ctx, nh.GetNoOPSession(1), payload)
+			if err != nil {
+				t.Fatalf("failed to propose %v", err)
+			}
+			if r.Value != uint64(len(payload)) {
+				t.Errorf("unexpected result %d", r.Value)
+			}
+			if applied := n.sm.GetLastApplied(); applied < index+11 {
+				t.Errorf("proposal not chunked, applied %d, was %d", applied, index)
+			}
+			if v := readCloneTestValue(t, nh, 1, "k"); v != string(payload[2:]) {
+				t.Errorf("unexpected value")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestChunkedProposalCanBeRetriedAfterLeaderFailover(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		peers := make(map[uint64]string)
+		for i := range nhs {
+			peers[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		for i, nh := range nhs {
+			rc := getBootstrapTestConfig(uint64(i + 1))
+			rc.ShardID = 1
+			rc.MaxEntryChunkBytes = chunkTestChunkSize
+			if err := nh.StartReplica(peers, false, newCloneTestSM, rc); err != nil {
+				t.Fatalf("failed to start replica %v", err)
+			}
+		}
+		for _, nh := range nhs {
+			waitForLeaderToBeElected(t, nh, 1)
+		}
+		leaderID, _, _, err := nhs[0].GetLeaderID(1)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		leader := nhs[leaderID-1]
+		payload := getChunkTestPayload("v")
+		chunks, manifest := rsm.GetChunked(dio.NoCompression,
+			1, payload, chunkTestChunkSize)
+		// half of the chunks are committed before the leader changes
+		proposeChunkTestEntries(t, leader, leader.GetNoOPSession(1),
+			chunks[:len(chunks)/2])
+		targetID := leaderID%uint64(len(nhs)) + 1
+		// the transfer is requested again when the target is not ready
+		for i := 0; ; i++ {
+			if i > 100 {
+				t.Fatalf("leadership not transferred")
+			}
+			if err := leader.RequestLeaderTransfer(1, targetID); err != nil {
+				t.Fatalf("failed to transfer leadership %v", err)
+			}
+			id, _, ok, err := leader.GetLeaderID(1)
+			if err == nil && ok && id == targetID {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		newLeader := nhs[targetID-1]
+		ctx, cancel := context.WithTimeout(context.Background(), pto(newLeader))
+		defer cancel()
+		session, err := newLeader.SyncGetSession(ctx, 1)
+		if err != nil {
+			t.Fatalf("failed to get session %v", err)
+		}
+		proposeChunkTestEntries(t, newLeader, newLeader.GetNoOPSession(1),
+			chunks[len(chunks)/2:])
+		err = getChunkTestManifestResult(t, newLeader, session, manifest)
+		if !errors.Is(err, ErrAborted) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		// the aborted proposal is retried with the same client session
+		r, err := newLeader.SyncPropose(ctx, session, payload)
+		if err != nil {
+			t.Fatalf("failed to propose %v", err)
+		}
+		if r.Value != uint64(len(payload)) {
+			t.Errorf("unexpected result %d", r.Value)
+		}
+		for _, nh := range nhs {
+			if v := readCloneTestValue(t, nh, 1, "k"); v != string(payload[2:]) {
+				t.Errorf("unexpected value")
+			}
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
+
+func TestOrphanedChunksAreDiscardedBySnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	p1 := getChunkTestPayload("a")
+	p2 := getChunkTestPayload("b")
+	c1, m1 := rsm.GetChunked(dio.NoCompression, 1, p1, chunkTestChunkSize)
+	c2, m2 := rsm.GetChunked(dio.NoCompression, 2, p2, chunkTestChunkSize)
+	snapshot := func(nh *NodeHost) {
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+		defer cancel()
+		if _, err := nh.SyncRequestSnapshot(ctx,
+			1, DefaultSnapshotOption); err != nil {
+			t.Fatalf("failed to request snapshot %v", err)
+		}
+	}
+	to := &testOption{
+		createSM: newCloneTestSM,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.MaxEntryChunkBytes = chunkTestChunkSize
+			return c
+		},
+		restartNodeHost: true,
+		tf: func(nh *NodeHost) {
+			// all chunks of p1 and half of the chunks of p2 are committed
+			proposeChunkTestEntries(t, nh, nh.GetNoOPSession(1), c1)
+			proposeChunkTestEntries(t, nh, nh.GetNoOPSession(1), c2[:len(c2)/2])
+			snapshot(nh)
+			if !hasSnapshotChunkStreams(t, nh) {
+				t.Fatalf("chunks not saved in snapshot")
+			}
+		},
+		// the term changes when the replica is restarted from the snapshot
+		rf: func(nh *NodeHost) {
+			waitForLeaderToBeElected(t, nh, 1)
+			err := getChunkTestManifestResult(t, nh, nh.GetNoOPSession(1), m1)
+			if err != nil {
+				t.Fatalf("failed to complete the proposal %v", err)
+			}
+			if v := readCloneTestValue(t, nh, 1, "k"); v != string(p1[2:]) {
+				t.Errorf("unexpected value")
+			}
+			snapshot(nh)
+			if hasSnapshotChunkStreams(t, nh) {
+				t.Errorf("orphaned chunks saved in snapshot")
+			}
+			err = getChunkTestManifestResult(t, nh, nh.GetNoOPSession(1), m2)
+			if !errors.Is(err, ErrAborted) {
+				t.Errorf("unexpected error %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
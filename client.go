@@ -0,0 +1,57 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+
+	"github.com/lni/dragonboat/v4/client"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// Client is the subset of NodeHost methods commonly used by applications for
+// making requests to Raft shards. It is implemented by *NodeHost, services
+// depending on Client rather than *NodeHost can be unit tested using the
+// scriptable implementation provided by the plugin/clientmock package.
+//
+// Methods are expected to have the same semantics as their NodeHost
+// counterparts. Client is intentionally kept small, new methods are only added
+// when they are widely used by applications.
+type Client interface {
+	// GetNoOPSession returns a NO-OP client session for the specified shard.
+	GetNoOPSession(shardID uint64) *client.Session
+	// SyncGetSession registers and returns a new client session.
+	SyncGetSession(ctx context.Context, shardID uint64) (*client.Session, error)
+	// SyncCloseSession unregisters the specified client session.
+	SyncCloseSession(ctx context.Context, cs *client.Session) error
+	// SyncPropose makes a proposal using the specified client session.
+	SyncPropose(ctx context.Context,
+		session *client.Session, cmd []byte) (sm.Result, error)
+	// SyncRead performs a linearizable read on the specified shard.
+	SyncRead(ctx context.Context, shardID uint64,
+		query interface{}) (interface{}, error)
+	// SyncGetShardMembership returns the membership of the specified shard.
+	SyncGetShardMembership(ctx context.Context,
+		shardID uint64) (*Membership, error)
+	// GetLeaderID returns the leader replica ID, the term and whether the
+	// leader information is available.
+	GetLeaderID(shardID uint64) (uint64, uint64, bool, error)
+	// SyncRequestSnapshot requests a snapshot to be created for the specified
+	// shard and returns the index of the created snapshot.
+	SyncRequestSnapshot(ctx context.Context,
+		shardID uint64, opt SnapshotOption) (uint64, error)
+}
+
+var _ Client = (*NodeHost)(nil)
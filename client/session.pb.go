@@ -416,7 +416,10 @@ func (m *Session) PrepareForPropose() {
 
 // ProposalCompleted increases the series id and the RespondedTo value.
 // ProposalCompleted is expected to be called by the application every time
-// when a proposal is completed or aborted by the application.
+// when a proposal is completed or aborted by the application. It must only be
+// called once the proposal is known to be applied, i.e. when it is reported as
+// completed by the AppliedC() or ResultC() channel of the RequestState, never
+// on the notification delivered by the CommittedC() channel.
 func (m *Session) ProposalCompleted() {
 	m.assertRegularSession()
 	if m.SeriesID == m.RespondedTo+1 {
@@ -0,0 +1,206 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IndexUpdate is the commit and apply progress of a shard observed by the
+// local replica.
+type IndexUpdate struct {
+	ShardID uint64
+	// CommittedIndex is the largest Raft Log index known to be committed.
+	CommittedIndex uint64
+	// AppliedIndex is the largest Raft Log index applied by the local state
+	// machine.
+	AppliedIndex uint64
+	// LeaderID and Term are the known leader and its term.
+	LeaderID uint64
+	Term     uint64
+	// LeaderChanged indicates that the leader or the term changed since the
+	// previous update.
+	LeaderChanged bool
+	// Snapshot indicates that AppliedIndex jumped forward since the previous
+	// update as the local state machine was recovered from a snapshot, entries
+	// between the two AppliedIndex values were not applied one by one.
+	Snapshot bool
+}
+
+// indexSubscription is a subscriber of index updates of a shard.
+type indexSubscription struct {
+	c           chan IndexUpdate
+	minInterval time.Duration
+	last        IndexUpdate
+	lastTime    time.Time
+	started     bool
+}
+
+// next returns the update to be delivered, false is returned when there is
+// nothing new since the last delivered update.
+func (s *indexSubscription) next(u IndexUpdate, recovered uint64) (IndexUpdate, bool) {
+	if !s.started {
+		return u, true
+	}
+	// indexes are kept monotonic when the replica is restarted
+	if u.CommittedIndex < s.last.CommittedIndex {
+		u.CommittedIndex = s.last.CommittedIndex
+	}
+	if u.AppliedIndex < s.last.AppliedIndex {
+		u.AppliedIndex = s.last.AppliedIndex
+	}
+	if u.Term < s.last.Term || u.Term == 0 {
+		u.LeaderID, u.Term = s.last.LeaderID, s.last.Term
+	}
+	u.LeaderChanged = u.Term != s.last.Term || u.LeaderID != s.last.LeaderID
+	u.Snapshot = recovered > s.last.AppliedIndex && recovered <= u.AppliedIndex
+	return u, u.LeaderChanged ||
+		u.CommittedIndex > s.last.CommittedIndex ||
+		u.AppliedIndex > s.last.AppliedIndex
+}
+
+// indexSubscriptions contains subscribers of index updates keyed by shard ID.
+// Subscribers are updated by the tick worker, updates are coalesced to at
+// most one per the minInterval of the subscriber.
+type indexSubscriptions struct {
+	mu     sync.Mutex
+	shards map[uint64]map[*indexSubscription]struct{}
+	count  int32
+	closed bool
+}
+
+func (s *indexSubscriptions) add(shardID uint64,
+	minInterval time.Duration) (*indexSubscription, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, false
+	}
+	if s.shards == nil {
+		s.shards = make(map[uint64]map[*indexSubscription]struct{})
+	}
+	subs, ok := s.shards[shardID]
+	if !ok {
+		subs = make(map[*indexSubscription]struct{})
+		s.shards[shardID] = subs
+	}
+	sub := &indexSubscription{
+		c:           make(chan IndexUpdate, 1),
+		minInterval: minInterval,
+	}
+	subs[sub] = struct{}{}
+	atomic.AddInt32(&s.count, 1)
+	return sub, true
+}
+
+func (s *indexSubscriptions) remove(shardID uint64, sub *indexSubscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := s.shards[shardID]
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(s.shards, shardID)
+	}
+	atomic.AddInt32(&s.count, -1)
+	close(sub.c)
+}
+
+// close closes all subscriptions, no subscription can be added afterwards.
+func (s *indexSubscriptions) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, subs := range s.shards {
+		for sub := range subs {
+			close(sub.c)
+		}
+	}
+	s.shards = nil
+	s.closed = true
+	atomic.StoreInt32(&s.count, 0)
+}
+
+// update delivers index updates of the specified shards to their subscribers.
+func (s *indexSubscriptions) update(nodes []*node, now time.Time) {
+	if atomic.LoadInt32(&s.count) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range nodes {
+		subs, ok := s.shards[n.shardID]
+		if !ok {
+			continue
+		}
+		leaderID, term, _ := n.getLeaderID()
+		u := IndexUpdate{
+			ShardID:        n.shardID,
+			CommittedIndex: atomic.LoadUint64(&n.committedIndex),
+			AppliedIndex:   n.sm.GetLastApplied(),
+			LeaderID:       leaderID,
+			Term:           term,
+		}
+		recovered := atomic.LoadUint64(&n.recoveredIndex)
+		for sub := range subs {
+			if sub.started && now.Sub(sub.lastTime) < sub.minInterval {
+				continue
+			}
+			v, ok := sub.next(u, recovered)
+			if !ok {
+				continue
+			}
+			select {
+			case sub.c <- v:
+				sub.last = v
+				sub.lastTime = now
+				sub.started = true
+			default:
+				// the subscriber is slow, the update is retried in the next tick
+			}
+		}
+	}
+}
+
+// SubscribeCommitIndex returns a channel for receiving the commit and apply
+// progress of the specified shard observed by the local replica, along with
+// a function for stopping the subscription and closing the channel. The
+// first update describes the progress when the local replica of the shard
+// becomes available, further updates are delivered when the committed index,
+// the applied index or the leader changes.
+//
+// Updates are coalesced to at most one per minInterval, they are checked once
+// per RTTMillisecond. CommittedIndex, AppliedIndex and Term values of updates
+// delivered on the same channel never decrease, including when the local
+// replica is restarted or recovered from a snapshot. The subscription is
+// kept when the local replica is stopped, updates are resumed when the
+// replica is started again. The channel is closed when the NodeHost is
+// closed, a closed channel is returned when the NodeHost has been closed.
+//
+// Indexes are sampled from the bookkeeping of the local replica, a slow
+// subscriber only misses intermediate updates and never delays the replica.
+func (nh *NodeHost) SubscribeCommitIndex(shardID uint64,
+	minInterval time.Duration) (<-chan IndexUpdate, func()) {
+	sub, ok := nh.indexSubs.add(shardID, minInterval)
+	if !ok {
+		c := make(chan IndexUpdate)
+		close(c)
+		return c, func() {}
+	}
+	return sub.c, func() { nh.indexSubs.remove(shardID, sub) }
+}
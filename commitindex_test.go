@@ -0,0 +1,244 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+)
+
+func TestIndexSubscriptionUpdatesAreMonotonic(t *testing.T) {
+	s := &indexSubscription{}
+	first := IndexUpdate{CommittedIndex: 10, AppliedIndex: 8, LeaderID: 1, Term: 2}
+	u, ok := s.next(first, 0)
+	if !ok || u != first {
+		t.Fatalf("unexpected first update %+v", u)
+	}
+	s.last, s.started = u, true
+	if _, ok := s.next(first, 0); ok {
+		t.Errorf("unchanged progress delivered")
+	}
+	// restarted replica with unknown leader and replayed indexes
+	restarted := IndexUpdate{CommittedIndex: 9, AppliedIndex: 5}
+	if _, ok := s.next(restarted, 5); ok {
+		t.Errorf("restarted replica progress delivered")
+	}
+	u, ok = s.next(IndexUpdate{CommittedIndex: 11,
+		AppliedIndex: 6, LeaderID: 1, Term: 2}, 0)
+	if !ok || u.CommittedIndex != 11 || u.AppliedIndex != 8 ||
+		u.LeaderChanged || u.Snapshot {
+		t.Errorf("unexpected update %+v", u)
+	}
+	u, ok = s.next(IndexUpdate{CommittedIndex: 10,
+		AppliedIndex: 8, LeaderID: 2, Term: 3}, 0)
+	if !ok || !u.LeaderChanged || u.CommittedIndex != 10 {
+		t.Errorf("unexpected update %+v", u)
+	}
+	u, ok = s.next(IndexUpdate{CommittedIndex: 100,
+		AppliedIndex: 100, LeaderID: 1, Term: 2}, 90)
+	if !ok || !u.Snapshot || u.LeaderChanged {
+		t.Errorf("unexpected update %+v", u)
+	}
+}
+
+func TestIndexSubscriptionsAreClosed(t *testing.T) {
+	s := &indexSubscriptions{}
+	sub1, ok := s.add(1, 0)
+	if !ok {
+		t.Fatalf("failed to add")
+	}
+	sub2, _ := s.add(1, 0)
+	s.remove(1, sub1)
+	s.remove(1, sub1)
+	if _, ok := <-sub1.c; ok {
+		t.Errorf("channel not closed")
+	}
+	s.close()
+	if _, ok := <-sub2.c; ok {
+		t.Errorf("channel not closed")
+	}
+	s.remove(1, sub2)
+	if _, ok := s.add(1, 0); ok {
+		t.Errorf("subscription added after close")
+	}
+}
+
+type indexUpdateCollector struct {
+	mu      sync.Mutex
+	updates []IndexUpdate
+	done    chan struct{}
+}
+
+func collectIndexUpdates(c <-chan IndexUpdate) *indexUpdateCollector {
+	col := &indexUpdateCollector{done: make(chan struct{})}
+	go func() {
+		defer close(col.done)
+		for u := range c {
+			col.mu.Lock()
+			col.updates = append(col.updates, u)
+			col.mu.Unlock()
+		}
+	}()
+	return col
+}
+
+func (c *indexUpdateCollector) get() []IndexUpdate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]IndexUpdate(nil), c.updates...)
+}
+
+func (c *indexUpdateCollector) waitFor(t *testing.T,
+	f func(u IndexUpdate) bool) IndexUpdate {
+	for i := 0; i < 1000; i++ {
+		for _, u := range c.get() {
+			if f(u) {
+				return u
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("update not received, %+v", c.get())
+	return IndexUpdate{}
+}
+
+func checkIndexUpdates(t *testing.T, updates []IndexUpdate) {
+	for i := 1; i < len(updates); i++ {
+		prev, cur := updates[i-1], updates[i]
+		if cur.CommittedIndex < prev.CommittedIndex ||
+			cur.AppliedIndex < prev.AppliedIndex || cur.Term < prev.Term {
+			t.Fatalf("update %+v after %+v", cur, prev)
+		}
+		if cur.CommittedIndex == prev.CommittedIndex &&
+			cur.AppliedIndex == prev.AppliedIndex && !cur.LeaderChanged {
+			t.Fatalf("duplicated update %+v", cur)
+		}
+	}
+}
+
+// getCommitIndexTestConfig returns the config of the replica on the NodeHost
+// with the specified index, PreVote is enabled so the partitioned replica
+// doesn't disrupt the leader once the partition is healed.
+func getCommitIndexTestConfig(i int) config.Config {
+	return config.Config{
+		ShardID:      1,
+		ReplicaID:    uint64(i + 1),
+		ElectionRTT:  10,
+		HeartbeatRTT: 1,
+		CheckQuorum:  true,
+		PreVote:      true,
+	}
+}
+
+func TestCommitIndexSubscriptionAcrossSnapshotAndRestart(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		collectors := make([]*indexUpdateCollector, len(nhs))
+		for i, nh := range nhs {
+			c, stop := nh.SubscribeCommitIndex(1, 0)
+			defer stop()
+			collectors[i] = collectIndexUpdates(c)
+		}
+		members := make(map[uint64]string)
+		for i := range nhs {
+			members[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		for i, nh := range nhs {
+			if err := nh.StartReplica(members, false,
+				newCloneTestSM, getCommitIndexTestConfig(i)); err != nil {
+				t.Fatalf("failed to start replica %v", err)
+			}
+		}
+		for _, nh := range nhs {
+			waitForLeaderToBeElected(t, nh, 1)
+		}
+		leaderID, _, _, err := nhs[0].GetLeaderID(1)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		leader := int(leaderID - 1)
+		col := collectors[leader]
+		col.waitFor(t, func(u IndexUpdate) bool {
+			return u.LeaderID == uint64(leader+1) && u.CommittedIndex > 0
+		})
+		laggard, index := partitionLaggard(t, network, nhs, leader)
+		col = collectors[laggard]
+		for i := 0; explainTestCompaction(t, nhs[leader]).FirstIndex <= index; i++ {
+			if i > 500 {
+				t.Fatalf("log not compacted")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		network.Heal()
+		u := col.waitFor(t, func(u IndexUpdate) bool {
+			return u.Snapshot
+		})
+		if u.AppliedIndex < index {
+			t.Errorf("applied index %d, snapshot index %d", u.AppliedIndex, index)
+		}
+		last := col.get()[len(col.get())-1]
+		nh := nhs[laggard]
+		if err := nh.StopShard(1); err != nil {
+			t.Fatalf("failed to stop shard %v", err)
+		}
+		rc := getCommitIndexTestConfig(laggard)
+		for i := 0; ; i++ {
+			if err := nh.StartReplica(nil, false, newCloneTestSM, rc); err == nil {
+				break
+			} else if i > 1000 {
+				t.Fatalf("failed to restart replica %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !makeTestProposal(nhs[leader], 100) {
+			t.Fatalf("failed to make proposal")
+		}
+		col.waitFor(t, func(u IndexUpdate) bool {
+			return u.AppliedIndex > last.AppliedIndex
+		})
+		for _, c := range collectors {
+			checkIndexUpdates(t, c.get())
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
+
+func TestCommitIndexUpdatesAreCoalesced(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		nh := nhs[0]
+		c, stop := nh.SubscribeCommitIndex(1, time.Second)
+		col := collectIndexUpdates(c)
+		startMemTransportShard(t, nhs, 1)
+		start := time.Now()
+		for i := 0; i < 20; i++ {
+			if !makeTestProposal(nh, 100) {
+				t.Fatalf("failed to make proposal")
+			}
+		}
+		elapsed := time.Since(start)
+		if n := len(col.get()); n > int(elapsed/time.Second)+2 {
+			t.Errorf("%d updates in %s", n, elapsed)
+		}
+		stop()
+		<-col.done
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
@@ -0,0 +1,343 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync/atomic"
+
+	"github.com/lni/dragonboat/v4/internal/server"
+)
+
+// CompactionBlockReason is the reason why applied Raft log entries retained by
+// a replica have not been compacted.
+type CompactionBlockReason uint8
+
+const (
+	// CompactionNotBlocked indicates that all applied entries not covered by the
+	// compaction overhead have been compacted.
+	CompactionNotBlocked CompactionBlockReason = iota
+	// CompactionPending indicates that entries up to CompactionReport.CompactTo
+	// are being removed from the LogDB.
+	CompactionPending
+	// CompactionWitness indicates that the replica is a witness, witnesses do
+	// not create snapshots, their logs are only compacted when snapshots are
+	// received from the leader.
+	CompactionWitness
+	// CompactionOverheadRetention indicates that the retained entries are kept
+	// as specified by config.Config.CompactionOverhead, creating a new snapshot
+	// would not compact any of them.
+	CompactionOverheadRetention
+	// CompactionSnapshotStreaming indicates that new snapshots can not be
+	// created while the on disk state machine is streaming a snapshot to a
+	// remote replica.
+	CompactionSnapshotStreaming
+	// CompactionSnapshotInProgress indicates that a snapshot is being saved or
+	// recovered, entries are compacted once a new snapshot is saved.
+	CompactionSnapshotInProgress
+	// CompactionAutoSnapshotDisabled indicates that config.Config.SnapshotEntries
+	// is 0, use NodeHost.RequestSnapshot to create snapshots and compact the log.
+	CompactionAutoSnapshotDisabled
+	// CompactionNoSnapshot indicates that the replica has not created any
+	// snapshot yet.
+	CompactionNoSnapshot
+	// CompactionSnapshotThresholdNotReached indicates that the number of entries
+	// applied since the last snapshot has not reached
+	// config.Config.SnapshotEntries.
+	CompactionSnapshotThresholdNotReached
+	// CompactionSnapshotQueued indicates that a snapshot is waiting for its
+	// turn to be saved, see config.ExpertConfig.MaxConcurrentSnapshots.
+	CompactionSnapshotQueued
+	// CompactionLaggardFollower indicates that the leader holds back compaction
+	// for the lagging follower CompactionReport.LaggardReplicaID until its
+	// grace specified by config.Config.CompactionLaggardGraceTicks expires.
+	CompactionLaggardFollower
+	// CompactionDeadFollower indicates that the leader holds back compaction
+	// for the lagging follower CompactionReport.LaggardReplicaID, which has not
+	// been in contact with the leader, until its grace specified by
+	// config.Config.CompactionDeadFollowerGraceTicks expires.
+	CompactionDeadFollower
+	// CompactionStandby indicates that the replica is a warm standby, standbys
+	// do not create snapshots before they are activated, their logs are only
+	// compacted when snapshots are received from the leader.
+	CompactionStandby
+)
+
+var compactionBlockReasonNames = [...]string{
+	"NotBlocked",
+	"Pending",
+	"Witness",
+	"OverheadRetention",
+	"SnapshotStreaming",
+	"SnapshotInProgress",
+	"AutoSnapshotDisabled",
+	"NoSnapshot",
+	"SnapshotThresholdNotReached",
+	"SnapshotQueued",
+	"LaggardFollower",
+	"DeadFollower",
+	"Standby",
+}
+
+func (r CompactionBlockReason) String() string {
+	return compactionBlockReasonNames[r]
+}
+
+// CompactionReport explains the Raft log compaction state of a replica, see
+// NodeHost.ExplainCompaction for details.
+type CompactionReport struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// FirstIndex and LastIndex are the first and last indexes of the Raft log
+	// retained by the replica.
+	FirstIndex uint64
+	LastIndex  uint64
+	// AppliedIndex is the last index applied by the state machine.
+	AppliedIndex uint64
+	// SnapshotIndex is the index of the last snapshot created or recovered by
+	// the replica, it is 0 when there is no such snapshot.
+	SnapshotIndex uint64
+	// CompactTo is the index up to which entries have been scheduled to be
+	// compacted, it is computed from SnapshotIndex and the compaction overhead.
+	CompactTo uint64
+	// SnapshotEntries and CompactionOverhead are the values specified in
+	// config.Config.
+	SnapshotEntries    uint64
+	CompactionOverhead uint64
+	// SnapshotQueuePosition is the position of the replica in the queue of
+	// replicas waiting to save or recover snapshots, it is 0 when the replica
+	// is not waiting.
+	SnapshotQueuePosition uint64
+	// Reason is the reason why applied entries in the range of
+	// [FirstIndex, AppliedIndex] have not been compacted.
+	Reason CompactionBlockReason
+	// MembershipSnapshot is the decision made by the
+	// config.Config.SnapshotOnMembershipChange policy for the last applied
+	// membership change, MembershipSnapshotIndex is the applied index at the
+	// time the decision was made.
+	MembershipSnapshot      MembershipSnapshotDecision
+	MembershipSnapshotIndex uint64
+	// LaggardReplicaID is the ID of the lagging follower for which the leader
+	// holds back compaction, LaggardGraceTicks is the number of ticks left
+	// before its grace expires. LaggardReplicaID is 0 when compaction is not
+	// held back.
+	LaggardReplicaID  uint64
+	LaggardGraceTicks uint64
+	// CutOffReplicaIDs are the IDs of lagging followers whose grace expired,
+	// compaction on the leader is no longer held back for them and they are to
+	// be brought up to date by snapshots.
+	CutOffReplicaIDs []uint64
+}
+
+// RetainedEntries returns the number of Raft log entries retained by the
+// replica.
+func (r CompactionReport) RetainedEntries() uint64 {
+	if r.LastIndex < r.FirstIndex {
+		return 0
+	}
+	return r.LastIndex - r.FirstIndex + 1
+}
+
+// compactionState is the compaction state of a replica used for determining
+// the CompactionBlockReason.
+type compactionState struct {
+	report    CompactionReport
+	witness   bool
+	standby   bool
+	pending   bool
+	saving    bool
+	streaming bool
+	dead      bool
+}
+
+func (s compactionState) blockReason() CompactionBlockReason {
+	r := s.report
+	if r.LaggardReplicaID > 0 {
+		if s.dead {
+			return CompactionDeadFollower
+		}
+		return CompactionLaggardFollower
+	}
+	if s.pending || (r.CompactTo > 0 && r.CompactTo >= r.FirstIndex) {
+		return CompactionPending
+	}
+	if s.witness {
+		return CompactionWitness
+	}
+	if s.standby {
+		return CompactionStandby
+	}
+	// the index up to which the log would be compacted by a new snapshot
+	compactable := uint64(0)
+	if r.AppliedIndex > r.CompactionOverhead {
+		compactable = r.AppliedIndex - r.CompactionOverhead
+	}
+	if compactable < r.FirstIndex {
+		if r.AppliedIndex >= r.FirstIndex {
+			return CompactionOverheadRetention
+		}
+		return CompactionNotBlocked
+	}
+	if s.streaming {
+		return CompactionSnapshotStreaming
+	}
+	if s.saving && r.SnapshotQueuePosition > 0 {
+		return CompactionSnapshotQueued
+	}
+	if s.saving {
+		return CompactionSnapshotInProgress
+	}
+	if r.SnapshotEntries == 0 {
+		return CompactionAutoSnapshotDisabled
+	}
+	if r.SnapshotIndex == 0 {
+		return CompactionNoSnapshot
+	}
+	return CompactionSnapshotThresholdNotReached
+}
+
+func (n *node) getCompactionState() compactionState {
+	first, last := n.logReader.GetRange()
+	laggard := n.laggards.getState()
+	compactTo := atomic.LoadUint64(&n.compactTo)
+	if first > 0 && compactTo < first-1 {
+		// entries before the first index have been compacted
+		compactTo = first - 1
+	}
+	return compactionState{
+		report: CompactionReport{
+			ShardID:               n.shardID,
+			ReplicaID:             n.replicaID,
+			FirstIndex:            first,
+			LastIndex:             last,
+			AppliedIndex:          n.sm.GetLastApplied(),
+			SnapshotIndex:         n.ss.getIndex(),
+			CompactTo:             compactTo,
+			SnapshotEntries:       n.config.SnapshotEntries,
+			CompactionOverhead:    n.config.CompactionOverhead,
+			SnapshotQueuePosition: n.getSnapshotQueuePosition(),
+			MembershipSnapshot: MembershipSnapshotDecision(
+				atomic.LoadUint32(&n.membershipSSDecision)),
+			MembershipSnapshotIndex: atomic.LoadUint64(&n.membershipSSIndex),
+			LaggardReplicaID:        laggard.replicaID,
+			LaggardGraceTicks:       laggard.remaining,
+			CutOffReplicaIDs:        laggard.cutOff,
+		},
+		witness:   n.isWitness(),
+		standby:   n.isStandby(),
+		pending:   n.ss.hasCompactLogTo(),
+		saving:    n.ss.saving() || n.ss.recovering(),
+		streaming: n.ss.streaming(),
+		dead:      laggard.dead,
+	}
+}
+
+func (n *node) explainCompaction() CompactionReport {
+	s := n.getCompactionState()
+	s.report.Reason = s.blockReason()
+	return s.report
+}
+
+// checkLogRetention publishes a LogRetentionExceeded event when the number of
+// retained entries first exceeds LogRetentionAlertFactor times
+// SnapshotEntries. It is invoked on each tick.
+func (n *node) checkLogRetention() {
+	if n.config.LogRetentionAlertFactor == 0 || n.config.SnapshotEntries == 0 {
+		return
+	}
+	limit := n.config.LogRetentionAlertFactor * n.config.SnapshotEntries
+	first, last := n.logReader.GetRange()
+	if last < first || last-first+1 <= limit {
+		n.logRetentionReported = false
+		return
+	}
+	if n.logRetentionReported {
+		return
+	}
+	n.logRetentionReported = true
+	r := n.explainCompaction()
+	plog.Warningf("%s retained %d entries in [%d, %d], reason %s",
+		n.id(), r.RetainedEntries(), r.FirstIndex, r.LastIndex, r.Reason)
+	n.sysEvents.Publish(server.SystemEvent{
+		Type:       server.LogRetentionExceeded,
+		ShardID:    n.shardID,
+		ReplicaID:  n.replicaID,
+		Index:      r.SnapshotIndex,
+		FirstIndex: r.FirstIndex,
+		LastIndex:  r.LastIndex,
+		Reason:     r.Reason.String(),
+	})
+}
+
+// ExplainCompaction returns a CompactionReport describing the Raft log
+// compaction state of the local replica of the specified shard, it explains
+// why applied Raft log entries have not been compacted, e.g. when the log
+// keeps growing. Entries are only retained for lagging remote replicas within
+// the grace specified by config.Config.CompactionLaggardGraceTicks and
+// config.Config.CompactionDeadFollowerGraceTicks, such replicas are brought up
+// to date using snapshots once the required entries have been compacted.
+func (nh *NodeHost) ExplainCompaction(shardID uint64) (CompactionReport, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return CompactionReport{}, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return CompactionReport{}, ErrShardNotFound
+	}
+	return n.explainCompaction(), nil
+}
+
+// retainedCompaction is a range of entries compacted from the log on the
+// specified tick with their removal from the LogDB delayed as specified by
+// config.Config.CompactedEntriesRetentionTicks.
+type retainedCompaction struct {
+	index uint64
+	tick  uint64
+}
+
+// retainCompactedLog delays the removal of entries up to compactTo from the
+// LogDB so they can still be sent to followers lagging behind the compaction
+// point as specified by config.Config.MaxEntriesOverSnapshot.
+func (n *node) retainCompactedLog(compactTo uint64) {
+	rc := n.retainedCompactions
+	if len(rc) > 0 && rc[len(rc)-1].index >= compactTo {
+		return
+	}
+	n.retainedCompactions = append(rc, retainedCompaction{
+		index: compactTo,
+		tick:  n.currentTick,
+	})
+}
+
+// removeRetainedLog removes retained entries from the LogDB once their
+// retention expires. It is invoked on each tick.
+func (n *node) removeRetainedLog() error {
+	compactTo := uint64(0)
+	expired := 0
+	for _, rc := range n.retainedCompactions {
+		if n.currentTick-rc.tick < n.config.CompactedEntriesRetentionTicks {
+			break
+		}
+		compactTo = rc.index
+		expired++
+	}
+	if expired == 0 {
+		return nil
+	}
+	n.retainedCompactions = n.retainedCompactions[expired:]
+	if len(n.retainedCompactions) == 0 {
+		n.retainedCompactions = nil
+	}
+	return n.removeCompactedLog(compactTo)
+}
@@ -0,0 +1,263 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/raft"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+)
+
+func TestCompactionBlockReason(t *testing.T) {
+	report := CompactionReport{
+		FirstIndex:      11,
+		LastIndex:       100,
+		AppliedIndex:    100,
+		SnapshotIndex:   10,
+		CompactTo:       10,
+		SnapshotEntries: 200,
+	}
+	withReport := func(f func(r *CompactionReport)) CompactionReport {
+		r := report
+		f(&r)
+		return r
+	}
+	tests := []struct {
+		state  compactionState
+		reason CompactionBlockReason
+	}{
+		{compactionState{report: report}, CompactionSnapshotThresholdNotReached},
+		{compactionState{report: report, pending: true}, CompactionPending},
+		{compactionState{report: withReport(func(r *CompactionReport) {
+			r.CompactTo = 50
+		})}, CompactionPending},
+		{compactionState{report: report, witness: true}, CompactionWitness},
+		{compactionState{report: report, standby: true}, CompactionStandby},
+		{compactionState{report: withReport(func(r *CompactionReport) {
+			r.CompactionOverhead = 90
+		})}, CompactionOverheadRetention},
+		{compactionState{report: withReport(func(r *CompactionReport) {
+			r.FirstIndex = 101
+			r.LastIndex = 100
+			r.SnapshotIndex = 100
+			r.CompactTo = 100
+		})}, CompactionNotBlocked},
+		{compactionState{report: report, streaming: true}, CompactionSnapshotStreaming},
+		{compactionState{report: report, saving: true}, CompactionSnapshotInProgress},
+		{compactionState{report: withReport(func(r *CompactionReport) {
+			r.SnapshotQueuePosition = 2
+		}), saving: true}, CompactionSnapshotQueued},
+		{compactionState{report: withReport(func(r *CompactionReport) {
+			r.SnapshotEntries = 0
+		})}, CompactionAutoSnapshotDisabled},
+		{compactionState{report: withReport(func(r *CompactionReport) {
+			r.FirstIndex = 1
+			r.SnapshotIndex = 0
+			r.CompactTo = 0
+		})}, CompactionNoSnapshot},
+		{compactionState{report: withReport(func(r *CompactionReport) {
+			r.CompactTo = 50
+			r.LaggardReplicaID = 2
+		})}, CompactionLaggardFollower},
+		{compactionState{report: withReport(func(r *CompactionReport) {
+			r.CompactTo = 50
+			r.LaggardReplicaID = 2
+		}), dead: true}, CompactionDeadFollower},
+	}
+	for idx, tt := range tests {
+		if reason := tt.state.blockReason(); reason != tt.reason {
+			t.Errorf("%d, got %s, want %s", idx, reason, tt.reason)
+		}
+	}
+}
+
+func requestTestSnapshot(t *testing.T, nh *NodeHost) uint64 {
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+	defer cancel()
+	index, err := nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption)
+	if err != nil {
+		t.Fatalf("failed to request snapshot %v", err)
+	}
+	return index
+}
+
+func waitForCompactionReason(t *testing.T, nh *NodeHost,
+	reason CompactionBlockReason) CompactionReport {
+	var r CompactionReport
+	for i := 0; i < 500; i++ {
+		var err error
+		r, err = nh.ExplainCompaction(1)
+		if err != nil {
+			t.Fatalf("failed to explain compaction, %v", err)
+		}
+		if r.Reason == reason {
+			return r
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("got reason %s, want %s, %+v", r.Reason, reason, r)
+	return r
+}
+
+func TestExplainCompaction(t *testing.T) {
+	tests := []struct {
+		snapshotEntries uint64
+		overhead        uint64
+		snapshot        bool
+		reason          CompactionBlockReason
+	}{
+		{1000, 0, false, CompactionNoSnapshot},
+		{0, 0, false, CompactionAutoSnapshotDisabled},
+		{0, 1000, true, CompactionOverheadRetention},
+		{0, 0, true, CompactionNotBlocked},
+		{1000, 0, true, CompactionSnapshotThresholdNotReached},
+	}
+	for _, tt := range tests {
+		fs := vfs.GetTestFS()
+		to := &testOption{
+			defaultTestNode: true,
+			updateConfig: func(c *config.Config) *config.Config {
+				c.SnapshotEntries = tt.snapshotEntries
+				c.CompactionOverhead = tt.overhead
+				return c
+			},
+			tf: func(nh *NodeHost) {
+				proposeTestData(t, nh, "before", 5)
+				ssIndex := uint64(0)
+				if tt.snapshot {
+					ssIndex = requestTestSnapshot(t, nh)
+				}
+				if tt.reason == CompactionSnapshotThresholdNotReached {
+					proposeTestData(t, nh, "after", 5)
+				}
+				r := waitForCompactionReason(t, nh, tt.reason)
+				if r.ShardID != 1 || r.ReplicaID != 1 || r.SnapshotIndex != ssIndex ||
+					r.SnapshotEntries != tt.snapshotEntries ||
+					r.CompactionOverhead != tt.overhead {
+					t.Errorf("unexpected report %+v", r)
+				}
+				if tt.snapshot && tt.overhead == 0 &&
+					(r.CompactTo != ssIndex || r.FirstIndex != ssIndex+1) {
+					t.Errorf("log not compacted to the snapshot index, %+v", r)
+				}
+				if !tt.snapshot && (r.FirstIndex != 1 || r.CompactTo != 0) {
+					t.Errorf("unexpected compaction, %+v", r)
+				}
+			},
+		}
+		runNodeHostTest(t, to, fs)
+	}
+}
+
+func TestExplainCompactionReturnsErrorForUnknownShard(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			if _, err := nh.ExplainCompaction(2); !errors.Is(err, ErrShardNotFound) {
+				t.Errorf("unexpected error %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestLogRetentionExceededIsReported(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.SnapshotEntries = 5
+			c.CompactionOverhead = 1000
+			c.LogRetentionAlertFactor = 2
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			listener := nh.events.sys.ul.(*testSysEventListener)
+			proposeTestData(t, nh, "retained", 20)
+			var events []raftio.LogRetentionInfo
+			for i := 0; i < 500; i++ {
+				if events = listener.getLogRetentionEvents(); len(events) > 0 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if len(events) != 1 {
+				t.Fatalf("unexpected events %+v", events)
+			}
+			e := events[0]
+			if e.ShardID != 1 || e.ReplicaID != 1 || e.FirstIndex != 1 ||
+				e.LastIndex-e.FirstIndex+1 <= 10 || e.SnapshotIndex == 0 ||
+				e.Reason != CompactionOverheadRetention.String() {
+				t.Errorf("unexpected event %+v", e)
+			}
+			proposeTestData(t, nh, "more", 5)
+			time.Sleep(50 * time.Millisecond)
+			if events = listener.getLogRetentionEvents(); len(events) != 1 {
+				t.Errorf("event unexpectedly published again, %+v", events)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestRetainedEntriesAreRemovedOnceRetentionExpires(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.SnapshotEntries = 0
+			c.CompactedEntriesRetentionTicks = 20
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			listener := nh.events.sys.ul.(*testSysEventListener)
+			proposeTestData(t, nh, "retained", 10)
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			opt := SnapshotOption{OverrideCompactionOverhead: true}
+			index, err := nh.SyncRequestSnapshot(ctx, 1, opt)
+			if err != nil {
+				t.Fatalf("failed to request snapshot %v", err)
+			}
+			var events []raftio.EntryInfo
+			for i := 0; i < 500; i++ {
+				if events = listener.getLogCompacted(); len(events) > 0 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if len(events) != 1 || events[0].Index != index {
+				t.Fatalf("unexpected events %+v, index %d", events, index)
+			}
+			n, ok := nh.getShard(1)
+			if !ok {
+				t.Fatalf("failed to get shard")
+			}
+			if _, err := n.logReader.RetainedEntries(index,
+				index+1, 0); err != raft.ErrCompacted {
+				t.Errorf("removed entry still available, %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
@@ -19,11 +19,13 @@ configurations.
 package config
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
 	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cockroachdb/errors"
@@ -37,6 +39,7 @@ import (
 	"github.com/lni/dragonboat/v4/logger"
 	"github.com/lni/dragonboat/v4/raftio"
 	pb "github.com/lni/dragonboat/v4/raftpb"
+	"github.com/lni/dragonboat/v4/tracing"
 )
 
 var (
@@ -70,10 +73,19 @@ type Config struct {
 	ShardID uint64
 	// CheckQuorum specifies whether the leader node should periodically check
 	// non-leader node status and step down to become a follower node when it no
-	// longer has the quorum.
+	// longer has the quorum. Pending proposals and config change requests not
+	// committed yet on the stepped down leader are completed with the timeout
+	// result as their outcome is unknown.
 	CheckQuorum bool
 	// Whether to use PreVote for this node. PreVote is described in the section
-	// 9.7 of the raft thesis.
+	// 9.7 of the raft thesis. With PreVote enabled, a node rejoining the shard
+	// after being partitioned can not force the leader to step down by having
+	// a higher term unless its log is at least as up-to-date as a quorum of the
+	// shard. Nodes with PreVote disabled still respond to PreVote requests.
+	// Nodes running earlier versions of dragonboat with PreVote disabled panic
+	// on such requests, to enable PreVote on an existing shard, first upgrade
+	// all of its nodes to a version that responds to PreVote requests, then
+	// enable PreVote on the nodes one at a time.
 	PreVote bool
 	// ElectionRTT is the minimum number of message RTT between elections. Message
 	// RTT is defined by NodeHostConfig.RTTMillisecond. The Raft paper suggests it
@@ -96,6 +108,25 @@ type Config struct {
 	// to set the heartbeat interval to be every 200 milliseconds, then
 	// HeartbeatRTT should be set to 2.
 	HeartbeatRTT uint64
+	// ElectionTimeout is the minimum interval between elections expressed as an
+	// absolute duration. When ElectionTimeout and HeartbeatInterval are set, the
+	// ElectionRTT and HeartbeatRTT values are derived from them using the
+	// NodeHostConfig.RTTMillisecond value of the NodeHost the replica is started
+	// on and any configured ElectionRTT and HeartbeatRTT values are ignored.
+	// This allows replicas of the same shard to run on NodeHost instances with
+	// different RTTMillisecond values while still having the same election
+	// and heartbeat intervals.
+	//
+	// The resulting intervals are exchanged between replicas configured this
+	// way. Messages from a remote replica with a heartbeat interval not shorter
+	// than half of the local election interval are dropped and reported as a
+	// bootstrap mismatch system event, as the local replica would keep starting
+	// elections when the remote replica is the leader.
+	ElectionTimeout time.Duration
+	// HeartbeatInterval is the interval between heartbeats expressed as an
+	// absolute duration. It must be set together with ElectionTimeout, see the
+	// ElectionTimeout field for details.
+	HeartbeatInterval time.Duration
 	// SnapshotEntries defines how often the state machine should be snapshotted
 	// automatically. It is defined in terms of the number of applied Raft log
 	// entries. SnapshotEntries can be set to 0 to disable such automatic
@@ -117,6 +148,60 @@ type Config struct {
 	// field to 0, users can still use NodeHost's RequestSnapshot or
 	// SyncRequestSnapshot methods to manually request snapshots.
 	SnapshotEntries uint64
+	// SnapshotIntervalSeconds defines the maximum wall time in seconds between
+	// two automatic snapshots of the replica. When set to a nonzero value, a
+	// snapshot is requested once the specified interval has elapsed since the
+	// last snapshot and at least one new entry has been applied since then. It
+	// allows replicas of shards with low write traffic, which take a long time
+	// to accumulate SnapshotEntries entries, to be snapshotted and to have their
+	// Raft logs compacted regularly.
+	//
+	// SnapshotIntervalSeconds works together with SnapshotEntries, a snapshot is
+	// requested by whichever of the two triggers first. The time of the last
+	// snapshot is recorded in the snapshot and survives restarts. The default
+	// value 0 disables time based snapshotting.
+	SnapshotIntervalSeconds uint64
+	// SnapshotOnMembershipChange indicates whether the leader replica requests a
+	// snapshot as soon as a membership change is applied. Replicas added to a
+	// shard whose last snapshot is old otherwise have to replay all entries
+	// retained since that snapshot, creating a snapshot allows the log to be
+	// compacted so the new replica is brought up to date by streaming the
+	// snapshot instead. Note that only entries not covered by CompactionOverhead
+	// are compacted.
+	//
+	// The snapshot is requested only when the leader retains at least
+	// MembershipChangeSnapshotEntries Raft log entries, it is scheduled in the
+	// same way as other snapshots, e.g. subject to
+	// config.ExpertConfig.MaxConcurrentSnapshots. The decision made for the last
+	// membership change is reported by NodeHost's ExplainCompaction method.
+	SnapshotOnMembershipChange bool
+	// MembershipChangeSnapshotEntries is the minimum number of Raft log entries
+	// retained by the leader for a snapshot to be requested when
+	// SnapshotOnMembershipChange is enabled. The default value 0 means that a
+	// snapshot is always requested.
+	MembershipChangeSnapshotEntries uint64
+	// FollowerAssistedSnapshots indicates whether the leader replica can
+	// delegate the transfer of a snapshot to a caught-up follower. When enabled,
+	// the leader asks an idle follower with a local snapshot at or above the
+	// index of the snapshot to be sent to stream its own snapshot to the target
+	// replica on behalf of the leader, e.g. when multiple replicas are added at
+	// the same time. The follower declines when it has no such snapshot, the
+	// leader then sends the snapshot itself. Snapshots of on disk state machines
+	// are always sent by the leader. Followers running a version of dragonboat
+	// that predates assisted snapshots are never asked to assist.
+	// FollowerAssistedSnapshots is disabled by default.
+	FollowerAssistedSnapshots bool
+	// SnapshotsToKeep is the number of most recent snapshots of the replica to
+	// keep on disk. Older snapshots are removed once they are no longer among
+	// the newest SnapshotsToKeep snapshots and are no longer in use, e.g. being
+	// streamed to a remote replica. The default value 0 is treated as 1, only
+	// the latest snapshot is kept.
+	//
+	// Retained older snapshots can be listed using NodeHost's ListSnapshots
+	// method, e.g. for point-in-time recovery. They are not used by Dragonboat,
+	// Raft log compaction is always based on the latest snapshot. Note that each
+	// retained snapshot takes roughly the same disk space as the latest one.
+	SnapshotsToKeep uint64
 	// CompactionOverhead defines the number of most recent entries to keep after
 	// each Raft log compaction. Raft log compaction is performed automatically
 	// every time a snapshot is created.
@@ -133,6 +218,62 @@ type Config struct {
 	// back to stream the full snapshot if any Raft log entry with index <= 9,500
 	// is required to be replicated.
 	CompactionOverhead uint64
+	// CompactionLaggardGraceTicks is the number of ticks for which the leader
+	// holds back Raft log compaction for a follower that is alive but lagging
+	// behind, i.e. a follower that still requires entries that would otherwise
+	// be compacted. Once the grace expires, compaction proceeds and the follower
+	// is brought up to date by receiving a snapshot. It allows followers that
+	// are briefly unavailable, e.g. restarted, to catch up using the retained
+	// entries without requiring a snapshot to be streamed. Witnesses are not
+	// considered as they only receive snapshots containing no state machine
+	// data. The default value 0 means that compaction is never held back.
+	CompactionLaggardGraceTicks uint64
+	// CompactionDeadFollowerGraceTicks is the number of ticks for which the
+	// leader holds back Raft log compaction for a lagging follower that has not
+	// responded to the leader for more than ElectionRTT ticks. It is expected to
+	// be shorter than CompactionLaggardGraceTicks as such follower may never
+	// come back, it can not be larger than CompactionLaggardGraceTicks.
+	CompactionDeadFollowerGraceTicks uint64
+	// CompactedEntriesRetentionTicks is the number of ticks for which Raft log
+	// entries compacted from the log are retained in the LogDB before they are
+	// physically removed. While retained, such entries can still be sent by the
+	// leader to lagging followers as specified by MaxEntriesOverSnapshot. Note
+	// that the storage space used by retained entries is only reclaimed after
+	// they are removed. The default value 0 means that compacted entries are
+	// removed immediately.
+	CompactedEntriesRetentionTicks uint64
+	// MaxEntriesOverSnapshot is the maximum number of compacted entries the
+	// leader is allowed to send to a follower that lags behind the compaction
+	// point instead of sending it a snapshot. Sending a moderate number of
+	// entries is usually much cheaper than streaming a snapshot of a large
+	// state machine. Only entries retained as specified by
+	// CompactedEntriesRetentionTicks can be sent, a snapshot is sent when any
+	// of the required entries has been removed. The default value 0 means that
+	// a snapshot is always sent to such followers.
+	MaxEntriesOverSnapshot uint64
+	// MaxCatchupBytesPerSecond is the maximum number of bytes of Raft log
+	// entries per second the leader replicates to each peer catching up, i.e.
+	// each peer with its match index more than CatchupThrottleLagEntries
+	// entries behind the leader's last index. It prevents a replica rebuilding
+	// after a long downtime from crowding out the replication traffic to
+	// healthy peers, replication to peers not lagging behind is never
+	// throttled. Snapshots are not covered, they are limited by NodeHostConfig's
+	// MaxSnapshotWriteBytesPerSecond. The default value 0 means the catch up
+	// replication is not throttled.
+	MaxCatchupBytesPerSecond uint64
+	// CatchupThrottleLagEntries is the number of Raft log entries a peer can
+	// be behind the leader's last index before the replication to it is
+	// throttled as specified by MaxCatchupBytesPerSecond. The default value
+	// 1000 is used when CatchupThrottleLagEntries is 0.
+	CatchupThrottleLagEntries uint64
+	// LogRetentionAlertFactor is the multiple of SnapshotEntries above which the
+	// number of Raft log entries retained by the replica is considered as
+	// excessive. A LogRetentionExceeded system event explaining why the log has
+	// not been compacted is published when the retained log grows beyond
+	// LogRetentionAlertFactor * SnapshotEntries entries, it is published again
+	// only after the retained log shrinks below that limit. Such check is
+	// disabled when LogRetentionAlertFactor or SnapshotEntries is 0.
+	LogRetentionAlertFactor uint64
 	// OrderedConfigChange determines whether Raft membership change is enforced
 	// with ordered config change ID.
 	//
@@ -144,6 +285,103 @@ type Config struct {
 	// change requests. This may cause a client to request a membership change
 	// based on stale membership data.
 	OrderedConfigChange bool
+	// ConfigChangeHistorySize is the maximum number of applied config changes
+	// recorded in the membership of the shard, the oldest records are dropped
+	// once the limit is reached. The history is included in snapshots and can
+	// be queried using the NodeHost.GetConfigChangeHistory method. The default
+	// value of 64 is used when ConfigChangeHistorySize is 0.
+	ConfigChangeHistorySize uint64
+	// MaxWitnesses is the maximum number of witnesses allowed in the shard. The
+	// default value of 1 is used when MaxWitnesses is 0. Regardless of
+	// MaxWitnesses, witnesses are never allowed to outnumber regular nodes.
+	// Membership changes violating such limits are rejected by the leader, the
+	// leader's MaxWitnesses value is used when replicas are configured
+	// differently.
+	MaxWitnesses uint64
+	// MaxNonVotings is the maximum number of non-voting members allowed in the
+	// shard. Requests for adding more non-voting members are rejected by the
+	// leader. There is no such limit when MaxNonVotings is 0.
+	MaxNonVotings uint64
+	// MaxRemovedReplicas is the maximum number of removed replica IDs kept in
+	// the membership of the shard. Once the limit is exceeded, the smallest
+	// removed replica IDs are pruned and summarized by a count, a hash and the
+	// largest pruned replica ID, any replica ID not larger than the largest
+	// pruned one is considered as removed unless it is a current member. The
+	// leader's MaxRemovedReplicas value is used when replicas are configured
+	// differently and it is applied when replicas are removed, including
+	// removed replica IDs recorded before the limit was introduced. The default
+	// value of 1024 is used when MaxRemovedReplicas is 0, it can't be larger
+	// than 4096. Removed replica IDs are not pruned when any member of the
+	// shard runs a version of dragonboat that predates pruning.
+	MaxRemovedReplicas uint64
+	// StagedPromotionMaxLag is the maximum number of Raft log entries a staged
+	// non-voting member can be behind the leader's last index for it to be
+	// automatically promoted to a regular node. Staged non-voting members are
+	// added by the NodeHost.RequestAddReplicaStaged method. The default value
+	// of 1000 is used when StagedPromotionMaxLag is 0.
+	StagedPromotionMaxLag uint64
+	// StagedPromotionMaxLagBytes is the maximum total size in bytes of Raft log
+	// entries a staged non-voting member can be missing for it to be
+	// automatically promoted. There is no such size limit when
+	// StagedPromotionMaxLagBytes is 0.
+	StagedPromotionMaxLagBytes uint64
+	// StagedPromotionTimeoutRTT is the number of RTTs the leader waits for a
+	// staged non-voting member to catch up. A system event is published by the
+	// leader when the staged non-voting member is not promoted in time, the
+	// wait is restarted when a new leader is elected. The leader keeps waiting
+	// indefinitely when StagedPromotionTimeoutRTT is 0.
+	StagedPromotionTimeoutRTT uint64
+	// NonVotingLagAlertEntries is the number of Raft log entries a non-voting
+	// member can be behind the leader's last index before it is considered as
+	// lagging behind. The leader publishes a NonVotingLagging system event when
+	// a non-voting member keeps lagging behind for more than
+	// NonVotingLagAlertRTT RTTs and a NonVotingLagRecovered system event once
+	// it caught up again. Such check is disabled when NonVotingLagAlertEntries
+	// is 0.
+	NonVotingLagAlertEntries uint64
+	// NonVotingLagAlertRTT is the number of RTTs a non-voting member needs to
+	// keep lagging behind before the NonVotingLagging system event is
+	// published.
+	NonVotingLagAlertRTT uint64
+	// LeaderPreference is the leadership priority of replicas in the shard keyed
+	// by ReplicaID, replicas not included have priority 0. When LeaderPreference
+	// is set, the leader automatically transfers the leadership to the replica
+	// with the highest priority among those that have a higher priority than
+	// the leader itself, healthy and caught up. LeaderPreference is expected to
+	// be identical on all replicas of the shard.
+	LeaderPreference map[uint64]uint64
+	// LeaderPreferenceWaitRTT is the number of RTTs the leader waits for a
+	// replica with a higher priority to remain healthy and caught up before
+	// transferring the leadership to it. ElectionRTT is used when
+	// LeaderPreferenceWaitRTT is 0.
+	LeaderPreferenceWaitRTT uint64
+	// LeaderPreferenceMinIntervalRTT is the minimum number of RTTs between two
+	// automatic leadership transfers initiated by the same replica, it prevents
+	// the leadership from flapping between replicas. 10 times of ElectionRTT is
+	// used when LeaderPreferenceMinIntervalRTT is 0.
+	LeaderPreferenceMinIntervalRTT uint64
+	// DegradedLeaderThreshold is the latency above which the leader considers
+	// itself as degraded, it is compared with the time spent by the local
+	// state machine in Update and the time spent saving Raft state to the
+	// LogDB, including the fsync. When either latency keeps exceeding
+	// DegradedLeaderThreshold for DegradedLeaderRTT consecutive RTTs, the
+	// leader publishes a LeaderDegraded system event and transfers the
+	// leadership to the healthy and caught up regular replica with the highest
+	// match index if there is one. The check is suspended while the leader is
+	// saving, recovering or streaming a snapshot. The default value 0 disables
+	// such check.
+	DegradedLeaderThreshold time.Duration
+	// DegradedLeaderRTT is the number of consecutive RTTs the latency needs to
+	// exceed DegradedLeaderThreshold before the leader is considered as
+	// degraded. ElectionRTT is used when DegradedLeaderRTT is 0.
+	DegradedLeaderRTT uint64
+	// DegradedLeaderCooldownRTT is the minimum number of RTTs between two
+	// LeaderDegraded system events published by the same replica, the replica
+	// does not hand off the leadership again during that period even when it
+	// regains the leadership, which prevents the leadership from ping-ponging
+	// between degraded replicas. 10 times of ElectionRTT is used when
+	// DegradedLeaderCooldownRTT is 0.
+	DegradedLeaderCooldownRTT uint64
 	// MaxInMemLogSize is the target size in bytes allowed for storing in memory
 	// Raft logs on each Raft node. In memory Raft logs are the ones that have
 	// not been applied yet.
@@ -151,7 +389,10 @@ type Config struct {
 	// growth, it is not for precisely limiting the exact memory usage.
 	// When MaxInMemLogSize is 0, the target is set to math.MaxUint64. When
 	// MaxInMemLogSize is set and the target is reached, error will be returned
-	// when clients try to make new proposals.
+	// when clients try to make new proposals. Entries already applied and saved
+	// to the LogDB are released from memory when the target is approached, they
+	// are read back from the LogDB when required, the target is thus only
+	// reached when entries can not be applied or saved fast enough.
 	// MaxInMemLogSize is recommended to be significantly larger than the biggest
 	// proposal you are going to use.
 	MaxInMemLogSize uint64
@@ -174,7 +415,8 @@ type Config struct {
 	// non-voting members in the section 4.2.1 of Diego Ongaro's thesis, they are
 	// used to allow a new node to join the shard and catch up with other
 	// existing ndoes without impacting the availability. Extra non-voting nodes
-	// can also be introduced to serve read-only requests.
+	// can also be introduced to serve read-only requests, both stale reads and
+	// linearizable reads using the ReadIndex protocol are supported.
 	IsNonVoting bool
 	// IsObserver indicates whether this is a non-voting Raft node without voting
 	// power.
@@ -187,39 +429,217 @@ type Config struct {
 	//
 	// Witness support is currently experimental.
 	IsWitness bool
+	// Standby indicates whether the non-voting node is started as a warm
+	// standby. A warm standby receives and persists Raft log entries and
+	// snapshots like other non-voting nodes, but its state machine is not
+	// created and committed entries are not applied until it is activated
+	// using NodeHost.ActivateStandby. Standby is recorded in the bootstrap info
+	// when the node joins the shard, it is ignored when restarting the node.
+	//
+	// Standby support is currently experimental.
+	Standby bool
+	// LazyReplay indicates whether the restarted replica should participate in
+	// Raft, e.g. voting, campaigning and persisting new entries, while its
+	// state machine is still being recovered from the latest snapshot and
+	// committed entries in the local Raft log are still being applied. By
+	// default, the replica only starts to participate in Raft after its state
+	// machine is recovered from the snapshot and it does not campaign before
+	// all committed entries have been applied. Proposals, linearizable reads
+	// and membership change requests made to the replica fail with
+	// ErrShardNotReady until all entries committed before the restart have
+	// been applied.
+	//
+	// LazyReplay is not supported by on disk state machines.
+	LazyReplay bool
+	// WriteFsyncMode specifies how Raft log writes of the shard are persisted
+	// by the built-in LogDB. The default StrictFsync mode acknowledges appended
+	// entries only after they are synced to disk. The RelaxedFsync mode trades
+	// the durability of recently acknowledged writes, including on process
+	// crashes, for skipping fsync on the critical path, see RelaxedFsync for
+	// details. It is intended for shards
+	// holding data that can be rebuilt, e.g. caches.
+	//
+	// WriteFsyncMode must be the same on all replicas of the shard, it is
+	// recorded in the bootstrap info and can not be changed once the replica
+	// is started. LogDB implementations other than the built-in one might
+	// always persist writes in the StrictFsync mode.
+	WriteFsyncMode WriteFsyncMode
+	// StorageClass specifies where the Raft log of the replica is stored. The
+	// default Durable class stores it in the LogDB on disk. The Volatile class
+	// stores it in a memory backed LogDB, see Volatile for details. It is
+	// intended for small shards whose durability is provided by replication
+	// across hosts rather than by the local disk.
+	//
+	// StorageClass is recorded in the bootstrap info and can not be changed
+	// once the replica is started. Replicas with different storage classes can
+	// be mixed on the same NodeHost.
+	StorageClass StorageClass
 	// Quiesce specifies whether to let the Raft shard enter quiesce mode when
 	// there is no shard activity. Shards in quiesce mode do not exchange
 	// heartbeat messages to minimize bandwidth consumption.
 	//
 	// Quiesce support is currently experimental.
 	Quiesce bool
+	// QuiesceThreshold is the number of ticks without shard activity after
+	// which the replica enters quiesce mode. When set to 0, 20 times of
+	// ElectionRTT is used. QuiesceThreshold can only be set when Quiesce is
+	// enabled, it must be at least 2 times of ElectionRTT.
+	QuiesceThreshold uint64
 	// WaitReady specifies whether to wait for the node to transition
 	// from recovering to ready state before returning from StartReplica.
 	WaitReady bool
+	// TraceSampleRatio is the ratio of proposals and linearizable reads traced
+	// when NodeHostConfig.TracerProvider is set. It must be in the range of
+	// [0, 1], the default value 0 disables tracing for the shard while 1 causes
+	// all of them to be traced.
+	TraceSampleRatio float64
+	// PropagateRequestIDs indicates whether a 16 bytes request ID is attached
+	// to each proposal made on the replica and persisted in the Raft log with
+	// the proposed entry. The request ID is taken from the context.Context of
+	// the proposal, see dragonboat.WithRequestID, or generated when it is not
+	// available. It is exposed to the state machine as the RequestID field of
+	// statemachine.Entry on all replicas and it is included in slow Update
+	// logs and SlowStateMachine events to help correlating apply issues with
+	// client requests. Entries are encoded without any extra byte when it is
+	// disabled. PropagateRequestIDs is disabled by default.
+	//
+	// Entries carrying a request ID use an encoding that can not be decoded by
+	// earlier versions of dragonboat, which fail to load such entries from
+	// their Raft logs and snapshots. PropagateRequestIDs must only be enabled
+	// after all replicas of the shard, including those that might be added
+	// later, have been upgraded to a version that supports it. It can not be
+	// disabled to allow a downgrade once such entries have been proposed.
+	PropagateRequestIDs bool
+	// SessionTTLEntries is the number of applied Raft log entries a client
+	// session is protected from eviction after its last activity, e.g. its
+	// registration or a proposal made with it. By default, when
+	// SessionTTLEntries is 0, the least recently used client session is
+	// evicted whenever registering a new client session would exceed the
+	// maximum number of client sessions allowed. When SessionTTLEntries is set,
+	// the least recently used client session is only evicted when it has been
+	// inactive for more than SessionTTLEntries entries, otherwise the new
+	// registration is rejected and SyncGetSession returns ErrSessionCapacity.
+	//
+	// Inactivity is measured in Raft log indexes so eviction decisions are
+	// the same on all replicas, SessionTTLEntries must thus be identical on all
+	// replicas of the shard.
+	SessionTTLEntries uint64
+	// MaxEntryChunkBytes is the max size in bytes of the payload of each Raft
+	// log entry used for replicating large proposals. When MaxEntryChunkBytes
+	// is set, proposals made using SyncPropose and SyncProposeCommitted with
+	// payloads larger than MaxEntryChunkBytes are split into chunk entries
+	// followed by a manifest entry made with the client session of the
+	// proposal, chunks are replicated as regular entries and reassembled by
+	// the state machine when the manifest is applied. The user state machine
+	// receives the proposal as a single entry with the original payload, the
+	// session semantics apply to the proposal as a whole.
+	//
+	// Chunked proposals with chunks lost, e.g. due to a leader change while
+	// the chunks are being proposed, fail with ErrAborted and can be retried.
+	// Chunks of abandoned proposals are discarded when snapshots are taken.
+	// Proposals made using the asynchronous Propose method are not chunked.
+	// MaxEntryChunkBytes is 0 by default, meaning large proposals are never
+	// chunked.
+	//
+	// Chunk and manifest entries use an encoding that can not be decoded by
+	// earlier versions of dragonboat, which fail to apply such entries and to
+	// load snapshots with pending chunks. MaxEntryChunkBytes must only be set
+	// after all replicas of the shard, including those that might be added
+	// later, have been upgraded to a version that supports it. It can not be
+	// reset to allow a downgrade once chunked proposals have been made.
+	MaxEntryChunkBytes uint64
 }
 
+// WriteFsyncMode is the type of modes used for persisting Raft log writes.
+type WriteFsyncMode uint8
+
+const (
+	// StrictFsync acknowledges Raft log writes only after they are synced to
+	// disk. It is the default mode.
+	StrictFsync WriteFsyncMode = iota
+	// RelaxedFsync acknowledges Raft log writes once they are handed to the
+	// LogDB without waiting for them to be synced to disk, they are synced
+	// asynchronously at least once every LogDBConfig.RelaxedSyncIntervalMS
+	// milliseconds or once LogDBConfig.RelaxedSyncBytes bytes have been
+	// written without being synced, whichever comes first. Writes changing the
+	// term or the vote of the replica and snapshot records are always synced
+	// before being acknowledged.
+	//
+	// The built-in LogDB only queues unsynced writes to be written to its WAL
+	// by a background writer, acknowledged writes not yet synced can thus be
+	// lost when the process crashes, not just when the host loses power or the
+	// OS crashes. A replica losing such writes is not aware of the loss. The
+	// loss of acknowledged entries on a single replica is enough for committed
+	// entries to be lost when it is followed by the failure of other replicas
+	// that hold those entries, e.g. a follower crashing and restarting before
+	// the leader fails, conflicting entries can then be committed for the same
+	// indexes on different replicas. RelaxedFsync must only be used when such
+	// loss is acceptable.
+	RelaxedFsync
+)
+
+// StorageClass is the type of storage classes of the Raft log.
+type StorageClass uint8
+
+const (
+	// Durable stores the Raft log in the LogDB on disk. It is the default
+	// storage class.
+	Durable StorageClass = iota
+	// Volatile stores the Raft log in a memory backed LogDB owned by the
+	// NodeHost, the Raft log is lost when the NodeHost is closed. The replica
+	// ID of the replica is preserved, the restarted replica rejoins the shard
+	// with an empty Raft log and recovers its state from other replicas via
+	// snapshot or log replication in the same way as a new replica.
+	//
+	// The restarted replica doesn't vote before it catches up with the commit
+	// index of the leader, a shard must thus not have a quorum of Volatile
+	// replicas restarted at around the same time.
+	// Volatile is not supported by single replica shards and on disk state
+	// machines.
+	Volatile
+)
+
 // Validate validates the Config instance and return an error when any member
 // field is considered as invalid.
 func (c *Config) Validate() error {
 	if c.ReplicaID == 0 {
 		return errors.New("invalid ReplicaID, it must be >= 1")
 	}
-	if c.HeartbeatRTT == 0 {
-		return errors.New("HeartbeatRTT must be > 0")
-	}
-	if c.ElectionRTT == 0 {
-		return errors.New("ElectionRTT must be > 0")
-	}
-	if c.ElectionRTT <= 2*c.HeartbeatRTT {
-		return errors.New("invalid election rtt")
+	if c.ElectionTimeout != 0 || c.HeartbeatInterval != 0 {
+		if c.ElectionTimeout <= 0 || c.HeartbeatInterval <= 0 {
+			return errors.New("ElectionTimeout and HeartbeatInterval must be > 0")
+		}
+		if c.ElectionTimeout <= 2*c.HeartbeatInterval {
+			return errors.New("invalid election timeout")
+		}
+		if c.ElectionTimeout < 10*c.HeartbeatInterval {
+			plog.Warningf("ElectionTimeout is not a magnitude larger than HeartbeatInterval")
+		}
 	}
-	if c.ElectionRTT < 10*c.HeartbeatRTT {
-		plog.Warningf("ElectionRTT is not a magnitude larger than HeartbeatRTT")
+	// ElectionRTT and HeartbeatRTT are derived from ElectionTimeout and
+	// HeartbeatInterval when the replica is started
+	if c.ElectionTimeout == 0 {
+		if c.HeartbeatRTT == 0 {
+			return errors.New("HeartbeatRTT must be > 0")
+		}
+		if c.ElectionRTT == 0 {
+			return errors.New("ElectionRTT must be > 0")
+		}
+		if c.ElectionRTT <= 2*c.HeartbeatRTT {
+			return errors.New("invalid election rtt")
+		}
+		if c.ElectionRTT < 10*c.HeartbeatRTT {
+			plog.Warningf("ElectionRTT is not a magnitude larger than HeartbeatRTT")
+		}
 	}
 	if c.MaxInMemLogSize > 0 &&
 		c.MaxInMemLogSize < settings.EntryNonCmdFieldsSize+1 {
 		return errors.New("MaxInMemLogSize is too small")
 	}
+	if c.MaxEntryChunkBytes > 0 && c.MaxInMemLogSize > 0 &&
+		c.MaxEntryChunkBytes >= c.MaxInMemLogSize {
+		return errors.New("MaxEntryChunkBytes must be < MaxInMemLogSize")
+	}
 	if c.SnapshotCompressionType != Snappy &&
 		c.SnapshotCompressionType != NoCompression {
 		return errors.New("unknown compression type")
@@ -228,15 +648,73 @@ func (c *Config) Validate() error {
 		c.EntryCompressionType != NoCompression {
 		return errors.New("unknown compression type")
 	}
-	if c.IsWitness && c.SnapshotEntries > 0 {
+	if c.IsWitness && (c.SnapshotEntries > 0 ||
+		c.SnapshotIntervalSeconds > 0 || c.SnapshotOnMembershipChange) {
 		return errors.New("witness node can not take snapshot")
 	}
+	if c.CompactionDeadFollowerGraceTicks > c.CompactionLaggardGraceTicks {
+		return errors.New("CompactionDeadFollowerGraceTicks is larger than " +
+			"CompactionLaggardGraceTicks")
+	}
 	if c.IsObserver {
 		c.IsNonVoting = true
 	}
 	if c.IsWitness && c.IsNonVoting {
 		return errors.New("witness node can not be a non-voting node")
 	}
+	if c.Standby && !c.IsNonVoting {
+		return errors.New("standby node must be a non-voting node")
+	}
+	if c.WriteFsyncMode > RelaxedFsync {
+		return errors.New("invalid WriteFsyncMode")
+	}
+	if c.StorageClass > Volatile {
+		return errors.New("invalid StorageClass")
+	}
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		return errors.New("TraceSampleRatio must be in the range of [0, 1]")
+	}
+	if c.DegradedLeaderThreshold < 0 {
+		return errors.New("invalid DegradedLeaderThreshold")
+	}
+	if c.MaxRemovedReplicas > settings.MaxRemovedReplicas {
+		return errors.New("MaxRemovedReplicas is too large")
+	}
+	if c.QuiesceThreshold > 0 {
+		if !c.Quiesce {
+			return errors.New("QuiesceThreshold set when Quiesce is disabled")
+		}
+		if c.QuiesceThreshold < 2*c.ElectionRTT {
+			return errors.New("QuiesceThreshold < 2 * ElectionRTT")
+		}
+	}
+	return nil
+}
+
+// SetTimingTicks sets the ElectionRTT and HeartbeatRTT fields using the
+// ElectionTimeout and HeartbeatInterval values and the specified
+// RTTMillisecond value. The election interval is rounded up while the
+// heartbeat interval is rounded down so the converted timings never make
+// elections more likely. It is a no-op when ElectionTimeout is not set.
+func (c *Config) SetTimingTicks(rttMillisecond uint64) error {
+	if c.ElectionTimeout == 0 {
+		return nil
+	}
+	if rttMillisecond == 0 {
+		return errors.New("RTTMillisecond must be > 0")
+	}
+	rtt := time.Duration(rttMillisecond) * time.Millisecond
+	election := uint64((c.ElectionTimeout + rtt - 1) / rtt)
+	heartbeat := uint64(c.HeartbeatInterval / rtt)
+	if heartbeat == 0 {
+		heartbeat = 1
+	}
+	if election <= 2*heartbeat {
+		return errors.Newf("ElectionTimeout %s too short for RTTMillisecond %d",
+			c.ElectionTimeout, rttMillisecond)
+	}
+	c.ElectionRTT = election
+	c.HeartbeatRTT = heartbeat
 	return nil
 }
 
@@ -259,8 +737,14 @@ type NodeHostConfig struct {
 	// NodeHostID specifies what NodeHostID to use. By default, when NodeHostID
 	// is empty, a random UUID will be generated and recorded by the system.
 	// Specifying a concrete NodeHostID here will cause the specified NodeHostID
-	// value to be used. NodeHostID is only used when DefaultNodeRegistryEnabled is
-	// set to true.
+	// value to be used. NodeHostID is only used to address NodeHost instances
+	// when DefaultNodeRegistryEnabled is set to true.
+	//
+	// Once recorded in NodeHostDir, the NodeHostID never changes. Creating the
+	// NodeHost instance fails with an error when NodeHostID is set to a value
+	// different from the recorded one. This allows a replacement host with its
+	// NodeHostDir restored from backup to be checked to have the expected
+	// identity, see tools.WriteNodeHostID for details on replacing hosts.
 	NodeHostID string
 	// WALDir is the directory used for storing the WAL of Raft entries. It is
 	// recommended to use low latency storage such as NVME SSD with power loss
@@ -303,7 +787,9 @@ type NodeHostConfig struct {
 	//
 	// Enabling DefaultNodeRegistryEnabled also enables the internal gossip service,
 	// NodeHostConfig.Gossip must be configured to control the behaviors of the
-	// gossip service.
+	// gossip service. Alternatively, NodeHostConfig.StaticRegistry or
+	// NodeHostConfig.Expert.RegistryFactory can be set to discover NodeHost
+	// instances without the gossip service.
 	//
 	// Note that once enabled, the DefaultNodeRegistryEnabled setting can not be later
 	// disabled after restarts.
@@ -319,6 +805,15 @@ type NodeHostConfig struct {
 	// interfaces. When hostname or domain name is used, it will be resolved to
 	// IPv4 addresses first and Dragonboat listens to all resolved IPv4 addresses.
 	ListenAddress string
+	// ListenAddresses is an optional list of addresses in the hostname:port,
+	// IP:port or [IPv6]:port form used by the transport module to listen on
+	// simultaneously, e.g. both 0.0.0.0:5012 and [::]:5012 can be specified to
+	// listen on both IPv4 and IPv6 wildcard sockets. When ListenAddresses is
+	// set, RaftAddress is only used as the advertised address of the NodeHost
+	// and it is never used for binding, the listen ports are allowed to be
+	// different from the port used in RaftAddress, e.g. when NAT is involved.
+	// ListenAddresses can not be set together with ListenAddress.
+	ListenAddresses []string
 	// MutualTLS defines whether to use mutual TLS for authenticating servers
 	// and clients. Insecure communication is used when MutualTLS is set to
 	// False.
@@ -334,6 +829,22 @@ type NodeHostConfig struct {
 	// KeyFile is the path of the node key file. This field is ignored when
 	// MutualTLS is false.
 	KeyFile string
+	// TransportAuthToken is the optional shared secret used for authenticating
+	// remote NodeHost instances when connections are established. When set,
+	// connections from remote NodeHost instances without the same token are
+	// rejected before any raft message or snapshot chunk is accepted. Remote
+	// NodeHost instances prove that they own the token by answering a random
+	// challenge, the token is never sent over the network and recorded
+	// handshakes can't be replayed. It is also used for encrypting gossip
+	// messages when the gossip service is enabled.
+	TransportAuthToken string
+	// AllowUnauthenticatedTransport allows connections from remote NodeHost
+	// instances that have not been configured with TransportAuthToken. It is
+	// used for enabling TransportAuthToken in a rolling manner - first set both
+	// TransportAuthToken and AllowUnauthenticatedTransport on all NodeHost
+	// instances, then unset AllowUnauthenticatedTransport. Connections with a
+	// mismatched token are always rejected.
+	AllowUnauthenticatedTransport bool
 	// LogDBFactory is the factory function used for creating the Log DB instance
 	// used by NodeHost. The default zero value causes the default built-in RocksDB
 	// based Log DB implementation to be used.
@@ -349,6 +860,71 @@ type NodeHostConfig struct {
 	// EnableMetrics determines whether health metrics in Prometheus format should
 	// be enabled.
 	EnableMetrics bool
+	// MaxMetricsShards is the maximum number of shards with their own per shard
+	// metrics series when EnableMetrics is set. Shards started after the limit
+	// is reached share the aggregated series labeled with shardid="other" and
+	// they don't have any per shard gauge. The default value 0 means there is
+	// no limit.
+	MaxMetricsShards uint64
+	// EnableProfilerLabels determines whether runtime/pprof labels should be
+	// attached to the goroutines of NodeHost. When enabled, long-lived goroutines
+	// are labelled with their role and worker ID, work done by the step, commit,
+	// apply, snapshot and close workers on behalf of a shard is further labelled
+	// with the shard ID and replica ID of the replica, allowing CPU profiles and
+	// goroutine dumps to be attributed to individual shards. Labelling per shard
+	// work has measurable overhead when there are many busy shards.
+	EnableProfilerLabels bool
+	// SlowSMThreshold is the duration after which an Update, Lookup or
+	// SaveSnapshot invocation of the user state machine is considered as slow.
+	// Slow invocations are reported to the SystemEventListener as
+	// SlowStateMachine events. The default value 0 disables such detection.
+	SlowSMThreshold time.Duration
+	// SlowDiskThreshold is the duration after which saving a batch of Raft
+	// state to the LogDB, including the fsync, is considered as slow. Slow saves
+	// are reported to the SystemEventListener as SlowDisk events for each shard
+	// included in the batch. The default value 0 disables such detection.
+	SlowDiskThreshold time.Duration
+	// ApplyStallThreshold is the duration after which a replica with committed
+	// entries not applied by its state machine is considered as stalled when
+	// the applied index doesn't advance. Stalled replicas are reported to the
+	// SystemEventListener as ApplyStalled events, an ApplyStallCleared event is
+	// published once the applied index advances again. The default value 0
+	// disables such events.
+	ApplyStallThreshold time.Duration
+	// HistoricalReadCacheTTL is the duration for which state machine instances
+	// materialized from retained snapshots by NodeHost's ReadAtSnapshot method
+	// are cached, repeated historical reads at the same snapshot within the
+	// duration are served by the cached instance. The default value 0 disables
+	// such caching.
+	HistoricalReadCacheTTL time.Duration
+	// AutoThaw indicates whether frozen replicas are automatically thawed on
+	// demand, i.e. when a message sent by a remote replica is received for the
+	// frozen replica or when a local request targets its shard. Requests
+	// triggering such thaw fail with ErrShardNotReady, they can be retried once
+	// the replica is thawed. See NodeHost.FreezeShard for details.
+	AutoThaw bool
+	// DiskMonitor contains options for monitoring the free space of NodeHostDir,
+	// WALDir and the data directories of on disk state machines. Disk space
+	// monitoring is disabled when DiskMonitor is empty.
+	DiskMonitor DiskMonitorConfig
+	// RunPreflightCheck indicates whether NewNodeHost should validate the
+	// environment, e.g. data directories, the RaftAddress and TLS files, using
+	// dragonboat.PreflightCheck before creating the NodeHost. NewNodeHost fails
+	// with the report of failed checks when any check fails.
+	RunPreflightCheck bool
+	// AuditOnStart indicates whether the persisted state of each replica should
+	// be cross-checked when the replica is restarted by StartReplica and its
+	// variants. The latest snapshot, the Raft state and the Raft log found in
+	// the LogDB are checked against each other, on disk state machines are
+	// opened and closed one extra time to have their applied indexes checked as
+	// well. StartReplica fails with a *dragonboat.AuditError describing the
+	// inconsistencies, which would otherwise cause panics later, and a
+	// StartupAuditFailed system event is published.
+	AuditOnStart bool
+	// AuditRepair indicates whether inconsistencies found by the AuditOnStart
+	// audit should be repaired when it is provably safe to do so, StartReplica
+	// proceeds when all found inconsistencies have been repaired.
+	AuditRepair bool
 	// RaftEventListener is the listener for Raft events, such as Raft leadership
 	// change, exposed to user space. NodeHost uses a single dedicated goroutine
 	// to invoke all RaftEventListener methods one by one, CPU intensive or IO
@@ -356,11 +932,46 @@ type NodeHostConfig struct {
 	// goroutines managed by users. See the raftio.IRaftEventListener definition
 	// for more details.
 	RaftEventListener raftio.IRaftEventListener
+	// TracerProvider is the optional provider of tracers used for tracing the
+	// lifecycle of proposals and linearizable reads. Trace context carried by
+	// the context.Context parameter of SyncPropose and SyncRead is propagated,
+	// spans created by Dragonboat are children of the spans in such context.
+	// See Config.TraceSampleRatio for controlling sampling for each shard.
+	TracerProvider tracing.TracerProvider
 	// SystemEventsListener allows users to be notified for system events such
 	// as snapshot creation, log compaction and snapshot streaming. It is usually
 	// used for testing purposes or for other advanced usages, Dragonboat
 	// applications are not required to explicitly set this field.
 	SystemEventListener raftio.ISystemEventListener
+	// SystemEventQueueSize is the maximum number of system events queued for
+	// delivery to the SystemEventListener. Events are published to the queue
+	// without blocking and they are delivered one by one from a dedicated
+	// goroutine, when the listener can't keep up with a full queue, the oldest
+	// queued event is dropped. Events still queued when the NodeHost is closed
+	// are discarded. See NodeHost.GetEventQueueStats for the number of dropped
+	// events. The default value 0 means 4096 events.
+	SystemEventQueueSize uint64
+	// MembershipListener is the listener notified for membership changes
+	// applied by replicas on the NodeHost, including those applied again when
+	// replaying the Raft log after restart. NodeHost invokes MembershipListener
+	// methods from the same dedicated goroutine used for RaftEventListener, see
+	// the raftio.IMembershipListener definition for more details.
+	MembershipListener raftio.IMembershipListener
+	// AdminAuditSink is the optional function invoked for each administrative
+	// operation, such as membership change, snapshot request, compaction,
+	// leader transfer and data removal, executed through the NodeHost. It is
+	// invoked synchronously from the goroutine that called the NodeHost method
+	// once the operation completed, it is never invoked from Raft worker
+	// goroutines. When it is not set, recent entries are kept in memory and can
+	// be retrieved using NodeHost.RecentAdminOps.
+	AdminAuditSink func(entry raftio.AuditEntry)
+	// SnapshotSideloader is an optional hook for transferring snapshot files
+	// out-of-band, e.g. via a shared object storage, rather than streaming them
+	// to other NodeHost instances. Snapshots sideloaded to a NodeHost instance
+	// without SnapshotSideloader set are rejected, they are streamed when sent
+	// again. Snapshots with external files are always streamed, witnesses are
+	// only sent snapshot metadata as regular messages.
+	SnapshotSideloader raftio.ISnapshotSideloader
 	// MaxSendQueueSize is the maximum size in bytes of each send queue.
 	// Once the maximum size is reached, further replication messages will be
 	// dropped to restrict memory usage. When set to 0, it means the send queue
@@ -371,11 +982,69 @@ type NodeHostConfig struct {
 	// dropped to restrict memory usage. When set to 0, it means the queue size
 	// is unlimited.
 	MaxReceiveQueueSize uint64
+	// MaxSnapshotWriteBytesPerSecond is the maximum rate in bytes per second at
+	// which snapshot data is written by all snapshot operations on the NodeHost,
+	// including snapshots exported to an ExportSink and snapshots streamed to
+	// remote replicas. It limits the I/O caused by reading large on disk state
+	// machines when snapshotting so other shards on the same device are not
+	// starved. Concurrent snapshot operations share the bandwidth fairly. When
+	// set to 0, it means the snapshot write rate is unlimited.
+	MaxSnapshotWriteBytesPerSecond uint64
+	// MaxSnapshotStagingBytes is the maximum number of bytes held in snapshot
+	// temp directories of all replicas on the NodeHost, i.e. snapshots being
+	// saved and snapshots being received. Once the limit is reached, new
+	// snapshot operations are deferred until in progress ones complete, local
+	// snapshots wait to be saved and incoming snapshots are rejected so they
+	// are sent again later. Snapshot operations already in progress are never
+	// interrupted, the limit can thus be exceeded. When set to 0, it means the
+	// staging space is unlimited.
+	MaxSnapshotStagingBytes uint64
+	// MaxMemoryBytes is the memory budget in bytes of the NodeHost, it is
+	// accounted against the in memory Raft logs, pending proposals and incoming
+	// message queues of all replicas on the NodeHost together with snapshot
+	// chunks held in memory by the transport. Once 80% of the budget is used,
+	// new proposals made to shards consuming the most memory are rejected with
+	// ErrSystemBusy. Once the budget is used up, new proposals made to all
+	// shards are rejected with ErrSystemBusy and remote NodeHosts are asked to
+	// pause sending entries when Expert.TransportFlowControl is set. Usage is
+	// refreshed every RTTMillisecond, the budget is a soft limit that can be
+	// briefly exceeded by entries already accepted. The breakdown is available
+	// from NodeHost.GetEngineStats. When set to 0, it means the memory budget
+	// is unlimited.
+	MaxMemoryBytes uint64
 	// NotifyCommit specifies whether clients should be notified when their
 	// regular proposals and config change requests are committed. By default,
 	// commits are not notified, clients are only notified when their proposals
 	// are both committed and applied.
 	NotifyCommit bool
+	// ReadOnlyMode indicates whether the NodeHost only hosts replicas serving
+	// reads. StartReplica and its variants fail with ErrReadOnlyNodeHost when
+	// config.Config.IsNonVoting is not set, proposals are rejected with
+	// ErrReadOnlyNodeHost, while StaleRead, SyncRead and ReadIndex based reads
+	// are served as usual. Replicas never campaign to become the leader, even
+	// when they are voting members of their shards according to the Raft log,
+	// e.g. after being started as regular replicas before ReadOnlyMode was
+	// enabled. Each suppressed campaign is reported by a CampaignSuppressed
+	// system event once per term.
+	ReadOnlyMode bool
+	// RejectCollocatedWitness indicates whether requests for adding a witness
+	// collocated with another replica of the same shard are rejected with
+	// ErrCollocatedWitness. A witness is collocated when its target resolves
+	// to a host already running a replica of the shard, hosts are identified
+	// by the host part of RaftAddress values resolved via the node registry
+	// when it is available. By default, such requests are only logged as
+	// warnings. The check can be skipped for individual requests by setting
+	// the Force field of dragonboat.AddReplicaOption, e.g. in test
+	// environments running all NodeHost instances on the same host.
+	RejectCollocatedWitness bool
+	// TenantOf is the optional function returning the tenant of the specified
+	// shard. When it is set, local replicas of shards of the same tenant share
+	// the quota configured for the tenant using NodeHost.SetTenantQuota, their
+	// memory usage is also attributed to the tenant in the MemoryStats
+	// returned by NodeHost.GetEngineStats. It is invoked once when the replica
+	// is started, shards mapped to an empty tenant are not subject to any
+	// tenant quota.
+	TenantOf func(shardID uint64) string
 	// Gossip contains configurations for the gossip service. When the
 	// DefaultNodeRegistryEnabled field is set to true, each NodeHost instance will use
 	// an internal gossip service to exchange knowledges of known NodeHost
@@ -465,6 +1134,12 @@ type NodeHostConfig struct {
 	// implements the raftio.INodeRegistry interface. A registry is simply a common
 	// channel shared between all nodes that allows them to identify each other.
 	Gossip GossipConfig
+	// StaticRegistry configures a file backed node registry to be used in the
+	// DefaultNodeRegistryEnabled mode as an alternative to the gossip service.
+	// NodeHostID to RaftAddress mappings of known NodeHost instances are loaded
+	// from the specified file, they can be updated by changing the file. Gossip
+	// and StaticRegistry can not both be set.
+	StaticRegistry StaticRegistryConfig
 
 	// Expert contains options for expert users who are familiar with the internals
 	// of Dragonboat. Users are recommended not to use this field unless
@@ -500,6 +1175,15 @@ type NodeRegistryFactory interface {
 	Create(nhid string, streamConnections uint64, v TargetValidator) (raftio.INodeRegistry, error)
 }
 
+// RegistryFactory is the interface used for creating custom registries used
+// for discovering NodeHost instances in the DefaultNodeRegistryEnabled mode.
+// The created registry is expected to publish the NodeHostID, RaftAddress and
+// optional metadata of the NodeHost instance, see the raftio.IRegistry
+// interface for more details.
+type RegistryFactory interface {
+	Create(nhConfig NodeHostConfig, nhid string) (raftio.IRegistry, error)
+}
+
 // TransportFactory is the interface used for creating custom transport modules.
 type TransportFactory interface {
 	// Create creates a transport module.
@@ -546,6 +1230,9 @@ func (c *NodeHostConfig) Validate() error {
 	if len(c.NodeHostDir) == 0 {
 		return errors.New("NodeHostConfig.NodeHostDir is empty")
 	}
+	if len(c.NodeHostID) > 0 && !id.IsNodeHostID(c.NodeHostID) {
+		return errors.New("invalid NodeHostConfig.NodeHostID")
+	}
 	if !c.MutualTLS {
 		plog.Warningf("mutual TLS disabled, communication is insecure")
 		if len(c.CAFile) > 0 || len(c.CertFile) > 0 || len(c.KeyFile) > 0 {
@@ -563,6 +1250,23 @@ func (c *NodeHostConfig) Validate() error {
 			return errors.New("key file not specified")
 		}
 	}
+	if c.SlowSMThreshold < 0 || c.SlowDiskThreshold < 0 {
+		return errors.New("invalid SlowSMThreshold or SlowDiskThreshold")
+	}
+	if c.ApplyStallThreshold < 0 {
+		return errors.New("invalid ApplyStallThreshold")
+	}
+	if c.HistoricalReadCacheTTL < 0 {
+		return errors.New("invalid HistoricalReadCacheTTL")
+	}
+	if !c.DiskMonitor.IsEmpty() {
+		if err := c.DiskMonitor.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.AllowUnauthenticatedTransport && len(c.TransportAuthToken) == 0 {
+		return errors.New("AllowUnauthenticatedTransport set without TransportAuthToken")
+	}
 	if c.MaxSendQueueSize > 0 &&
 		c.MaxSendQueueSize < settings.EntryNonCmdFieldsSize+1 {
 		return errors.New("MaxSendQueueSize value is too small")
@@ -571,15 +1275,45 @@ func (c *NodeHostConfig) Validate() error {
 		c.MaxReceiveQueueSize < settings.EntryNonCmdFieldsSize+1 {
 		return errors.New("MaxReceiveSize value is too small")
 	}
+	if c.MaxMemoryBytes > 0 &&
+		c.MaxMemoryBytes < settings.EntryNonCmdFieldsSize+1 {
+		return errors.New("MaxMemoryBytes value is too small")
+	}
 	if c.RaftRPCFactory != nil && c.Expert.TransportFactory != nil {
 		return errors.New("both TransportFactory and RaftRPCFactory specified")
 	}
 	if c.LogDBFactory != nil && c.Expert.LogDBFactory != nil {
 		return errors.New("both LogDBFactory and Expert.LogDBFactory specified")
 	}
-	if c.DefaultNodeRegistryEnabled && c.Gossip.IsEmpty() {
+	if c.DefaultNodeRegistryEnabled && c.Gossip.IsEmpty() &&
+		c.StaticRegistry.IsEmpty() && c.Expert.RegistryFactory == nil {
 		return errors.New("gossip service not configured")
 	}
+	if c.Expert.RegistryFactory != nil {
+		if !c.DefaultNodeRegistryEnabled {
+			return errors.New("Expert.RegistryFactory set when DefaultNodeRegistryEnabled is disabled")
+		}
+		if !c.Gossip.IsEmpty() || !c.StaticRegistry.IsEmpty() {
+			return errors.New("Expert.RegistryFactory set with Gossip or StaticRegistry")
+		}
+		if c.Expert.NodeRegistryFactory != nil {
+			return errors.New("both Expert.RegistryFactory and Expert.NodeRegistryFactory specified")
+		}
+	}
+	if c.Expert.RegistryPublishInterval < 0 {
+		return errors.New("invalid Expert.RegistryPublishInterval")
+	}
+	if !c.StaticRegistry.IsEmpty() {
+		if !c.DefaultNodeRegistryEnabled {
+			return errors.New("StaticRegistry set when DefaultNodeRegistryEnabled is disabled")
+		}
+		if !c.Gossip.IsEmpty() {
+			return errors.New("both Gossip and StaticRegistry specified")
+		}
+		if err := c.StaticRegistry.Validate(); err != nil {
+			return err
+		}
+	}
 	validate := c.GetRaftAddressValidator()
 	if !validate(c.RaftAddress) {
 		return errors.New("invalid NodeHost address")
@@ -587,6 +1321,16 @@ func (c *NodeHostConfig) Validate() error {
 	if len(c.ListenAddress) > 0 && !validate(c.ListenAddress) {
 		return errors.New("invalid ListenAddress")
 	}
+	if len(c.ListenAddresses) > 0 {
+		if len(c.ListenAddress) > 0 {
+			return errors.New("both ListenAddress and ListenAddresses specified")
+		}
+		for _, addr := range c.ListenAddresses {
+			if !validate(addr) && !IsValidIPv6Address(addr) {
+				return errors.New("invalid ListenAddresses")
+			}
+		}
+	}
 	if !c.Gossip.IsEmpty() {
 		if err := c.Gossip.Validate(); err != nil {
 			return err
@@ -597,6 +1341,24 @@ func (c *NodeHostConfig) Validate() error {
 			return err
 		}
 	}
+	if c.Expert.TransportDrainTimeout < 0 {
+		return errors.New("invalid Expert.TransportDrainTimeout")
+	}
+	if c.Expert.TransportKeepAliveInterval < 0 {
+		return errors.New("invalid Expert.TransportKeepAliveInterval")
+	}
+	if c.Expert.TransportKeepAliveCount < 0 {
+		return errors.New("invalid Expert.TransportKeepAliveCount")
+	}
+	if c.Expert.TransportPingInterval < 0 {
+		return errors.New("invalid Expert.TransportPingInterval")
+	}
+	if c.Expert.MaxSendStallDuration < 0 {
+		return errors.New("invalid Expert.MaxSendStallDuration")
+	}
+	if err := c.Expert.Socket.Validate(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -668,6 +1430,9 @@ func (c *NodeHostConfig) Prepare() error {
 	if c.Expert.FS == nil {
 		c.Expert.FS = vfs.DefaultFS
 	}
+	if c.Expert.Clock == nil {
+		c.Expert.Clock = DefaultClock
+	}
 	if c.Expert.Engine.IsEmpty() {
 		plog.Infof("using default EngineConfig")
 		c.Expert.Engine = GetDefaultEngineConfig()
@@ -684,6 +1449,9 @@ func (c *NodeHostConfig) Prepare() error {
 		c.Expert.LogDBFactory = &defaultLogDB{factory: c.LogDBFactory}
 		c.LogDBFactory = nil
 	}
+	if c.Expert.RegistryFactory != nil && c.Expert.RegistryPublishInterval == 0 {
+		c.Expert.RegistryPublishInterval = time.Second
+	}
 	return nil
 }
 
@@ -693,14 +1461,27 @@ func (c *NodeHostConfig) NodeRegistryEnabled() bool {
 }
 
 // GetListenAddress returns the actual address the transport module is going to
-// listen on.
+// listen on. The first address in ListenAddresses is returned when
+// ListenAddresses is set.
 func (c *NodeHostConfig) GetListenAddress() string {
+	if len(c.ListenAddresses) > 0 {
+		return c.ListenAddresses[0]
+	}
 	if len(c.ListenAddress) > 0 {
 		return c.ListenAddress
 	}
 	return c.RaftAddress
 }
 
+// GetListenAddresses returns all addresses the transport module is going to
+// listen on.
+func (c *NodeHostConfig) GetListenAddresses() []string {
+	if len(c.ListenAddresses) > 0 {
+		return c.ListenAddresses
+	}
+	return []string{c.GetListenAddress()}
+}
+
 // GetServerTLSConfig returns the server tls.Config instance based on the
 // TLS settings in NodeHostConfig.
 func (c *NodeHostConfig) GetServerTLSConfig() (*tls.Config, error) {
@@ -766,6 +1547,20 @@ func IsValidAddress(addr string) bool {
 	return stringutil.IsValidAddress(addr)
 }
 
+// IsValidIPv6Address returns a boolean value indicating whether the input
+// address is a valid address in the [IPv6]:port form.
+func IsValidIPv6Address(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || len(addr) == 0 || addr[0] != '[' {
+		return false
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+		return false
+	}
+	v, err := strconv.Atoi(port)
+	return err == nil && v > 0 && v <= 65535
+}
+
 // LogDBConfig is the configuration object for the LogDB storage engine. This
 // config option is only for advanced users when tuning the balance of I/O
 // performance and memory consumption.
@@ -797,6 +1592,14 @@ type LogDBConfig struct {
 	KVBlockSize                        uint64
 	SaveBufferSize                     uint64
 	MaxSaveBufferSize                  uint64
+	// RelaxedSyncIntervalMS is the maximum number of milliseconds that writes
+	// of shards in the RelaxedFsync mode stay unsynced, see RelaxedFsync for
+	// details. 100 is used when it is set to 0.
+	RelaxedSyncIntervalMS uint64
+	// RelaxedSyncBytes is the number of bytes written by shards in the
+	// RelaxedFsync mode from which such writes are synced without further
+	// delay. 16MBytes is used when it is set to 0.
+	RelaxedSyncBytes uint64
 }
 
 // GetDefaultLogDBConfig returns the default configurations for the LogDB
@@ -862,6 +1665,8 @@ func getDefaultLogDBConfig() LogDBConfig {
 		KVBlockSize:                        32 * 1024,
 		SaveBufferSize:                     32 * 1024,
 		MaxSaveBufferSize:                  64 * 1024 * 1024,
+		RelaxedSyncIntervalMS:              100,
+		RelaxedSyncBytes:                   16 * 1024 * 1024,
 	}
 }
 
@@ -897,8 +1702,76 @@ type EngineConfig struct {
 	// CloseShards is the number of close shards used for closing stopped
 	// state machines. Default value is 32.
 	CloseShards uint64
+	// SendQueueLength is the maximum number of messages that can be queued in
+	// each per remote NodeHost send queue. Default value is 2048.
+	SendQueueLength uint64
+	// SendQueueBytes is the maximum size in bytes of entries that can be queued
+	// in each per remote NodeHost send queue. When set to 0, the MaxSendQueueSize
+	// value in NodeHostConfig is used.
+	SendQueueBytes uint64
+	// SendQueueOverflowPolicy is the policy applied when a message is sent to a
+	// full send queue. Default policy is DropNewest.
+	SendQueueOverflowPolicy SendQueueOverflowPolicy
+	// SendQueueBlockTimeoutMS is the maximum number of milliseconds the sender
+	// is blocked when the BlockWithDeadline policy is used.
+	SendQueueBlockTimeoutMS uint64
+	// ReadBatchDelay is the maximum amount of time linearizable reads are held
+	// back to be coalesced into a single ReadIndex round. When set, reads
+	// received while a ReadIndex round of the shard is in flight are queued and
+	// requested together once that round completes or after ReadBatchDelay,
+	// whichever comes first. The delay is checked at least once per
+	// RTTMillisecond. Coalesced reads require far fewer heartbeat messages at
+	// the cost of a higher read latency. Default value is 0, which means a new
+	// ReadIndex round is requested for reads received in each step of the
+	// shard.
+	ReadBatchDelay time.Duration
+	// WorkerAffinity is an optional function returning the apply worker of the
+	// specified shard. The returned value is the index of the worker in
+	// EngineStats.ApplyWorkers, values not smaller than ApplyShards are wrapped
+	// around. The function must be deterministic and cheap, it is invoked on
+	// every ready notification of the shard. When not set, shards are assigned
+	// to apply workers by ShardID modulo ApplyShards. WorkerAffinity can be
+	// used to isolate heavy shards onto their own apply workers.
+	WorkerAffinity func(shardID uint64) uint64
+	// ProposalBatchDelayMicroseconds is the maximum number of microseconds
+	// proposals received by the leader are held back to be coalesced into a
+	// single append. Held back proposals are appended once the delay has passed
+	// since the first of them was received, or once ProposalBatchMaxBytes or
+	// ProposalBatchMaxCount is reached, whichever comes first. Larger appends
+	// require fewer LogDB writes and fewer Replicate messages at the cost of a
+	// higher proposal latency. Config changes and leader transfer requests are
+	// never held back. Default value is 0, which means proposals are appended
+	// in each step of the shard.
+	ProposalBatchDelayMicroseconds uint64
+	// ProposalBatchMaxBytes is the total size in bytes of held back proposals
+	// from which they are appended without further delay. When set to 0, held
+	// back proposals are not limited by their size.
+	ProposalBatchMaxBytes uint64
+	// ProposalBatchMaxCount is the number of held back proposals from which
+	// they are appended without further delay. When set to 0 or a value larger
+	// than the length of the incoming proposal queue, held back proposals are
+	// appended once the queue is full.
+	ProposalBatchMaxCount uint64
 }
 
+// SendQueueOverflowPolicy is the type of policies applied when the send queue
+// of a remote NodeHost is full.
+type SendQueueOverflowPolicy uint8
+
+const (
+	// DropNewest drops the message being sent when the send queue is full.
+	DropNewest SendQueueOverflowPolicy = iota
+	// DropOldestNonCritical drops the oldest queued entry replication related
+	// message to make room for the message being sent. Control messages such as
+	// heartbeats and votes are never dropped to make room, they are dropped as
+	// in DropNewest once their own queue is full.
+	DropOldestNonCritical
+	// BlockWithDeadline blocks the sender for up to SendQueueBlockTimeoutMS
+	// milliseconds waiting for the send queue to have room for the message, the
+	// message is dropped when the send queue is still full after the deadline.
+	BlockWithDeadline
+)
+
 // GetDefaultEngineConfig returns the default EngineConfig instance.
 func GetDefaultEngineConfig() EngineConfig {
 	return EngineConfig{
@@ -922,6 +1795,20 @@ func (ec EngineConfig) Validate() error {
 		ec.SnapshotShards == 0 || ec.CloseShards == 0 {
 		return errors.New("invalid engine configuration")
 	}
+	if ec.SendQueueBytes > 0 &&
+		ec.SendQueueBytes < settings.EntryNonCmdFieldsSize+1 {
+		return errors.New("SendQueueBytes value is too small")
+	}
+	if ec.SendQueueOverflowPolicy > BlockWithDeadline {
+		return errors.New("invalid SendQueueOverflowPolicy")
+	}
+	if ec.SendQueueOverflowPolicy == BlockWithDeadline &&
+		ec.SendQueueBlockTimeoutMS == 0 {
+		return errors.New("SendQueueBlockTimeoutMS not set")
+	}
+	if ec.ReadBatchDelay < 0 {
+		return errors.New("invalid ReadBatchDelay")
+	}
 	return nil
 }
 
@@ -945,8 +1832,91 @@ type ExpertConfig struct {
 	// transport module to be used by dragonbaot. When not set, the built-in TCP
 	// transport module is used.
 	TransportFactory TransportFactory
+	// TransportDrainTimeout is the maximum amount of time to spend on sending
+	// already queued messages to remote NodeHost instances when NodeHost is
+	// being stopped. Queued messages are dropped on stop when
+	// TransportDrainTimeout is 0.
+	TransportDrainTimeout time.Duration
+	// TransportKeepAliveInterval is the interval between TCP keepalive probes
+	// sent on connections created by the built-in TCP transport module. The
+	// default value of 10 seconds is used when TransportKeepAliveInterval is 0.
+	TransportKeepAliveInterval time.Duration
+	// TransportKeepAliveCount is the number of unacknowledged TCP keepalive
+	// probes after which the connection is considered as dead. The operating
+	// system default is used when TransportKeepAliveCount is 0. It is ignored on
+	// platforms other than Linux.
+	TransportKeepAliveCount int
+	// TransportPingInterval is the interval of the application level ping
+	// frames exchanged on idle message connections, it allows dead connections
+	// to be detected when there is no raft message to send, e.g. when shards
+	// are quiesced. Ping is disabled when TransportPingInterval is 0. All
+	// NodeHost instances must be running a version that supports ping frames
+	// before TransportPingInterval is set.
+	TransportPingInterval time.Duration
+	// MaxSendStallDuration is the maximum amount of time a message connection
+	// can be stalled when sending messages or waiting for the reply of a ping
+	// frame. The stalled connection is torn down and the affected remote nodes
+	// are reported as unreachable. The default write timeout of 5 seconds is
+	// used when MaxSendStallDuration is 0.
+	MaxSendStallDuration time.Duration
+	// TransportMultiplexing indicates whether raft messages and snapshot chunks
+	// sent to the same remote NodeHost should share a single TCP connection.
+	// Snapshot chunks are sent at a lower priority so they never starve raft
+	// messages such as heartbeats. Multiplexing is negotiated when connecting
+	// to the remote NodeHost, separate connections are used when it is not
+	// enabled on both ends. TransportMultiplexing is only applicable to the
+	// built-in TCP transport module.
+	TransportMultiplexing bool
+	// TransportFlowControl indicates whether entry batches sent to a remote
+	// NodeHost should be paused when the remote NodeHost reports that its
+	// inbound queues are full, e.g. when its LogDB is slow. This allows slow
+	// followers to push back on their leaders rather than dropping messages.
+	// Heartbeats and other small control messages are never paused. Inbound
+	// capacity is reported per NodeHost rather than per shard, it is the
+	// minimum of the remaining capacity of all local replicas, a single slow
+	// replica thus pauses entry batches sent to all replicas on its NodeHost.
+	// All NodeHost instances must be running a version that supports flow
+	// control before TransportFlowControl is set. TransportFlowControl is only
+	// applicable to the built-in TCP transport module.
+	TransportFlowControl bool
+	// MaxUnackedSnapshotBytes is the maximum size in bytes of snapshot chunk
+	// data sent to a remote NodeHost that has not yet been acknowledged by it.
+	// Chunks are acknowledged once they have been written to disk and fsynced by
+	// the remote NodeHost, snapshots are thus sent at the pace the receiving
+	// side can persist them rather than at the pace allowed by the network. At
+	// least one chunk is always allowed to be in flight. When set to 0, it means
+	// the unacknowledged size is unlimited. All NodeHost instances must be
+	// running a version that supports snapshot acks before
+	// MaxUnackedSnapshotBytes is set. MaxUnackedSnapshotBytes is only
+	// applicable to the built-in TCP transport module.
+	MaxUnackedSnapshotBytes uint64
+	// TransportMisdeliveryReport indicates whether the built-in TCP transport
+	// module should report messages targeting replicas unknown to the local
+	// NodeHost back to the sender rather than silently dropping them. Such
+	// reports are rate limited and surfaced on the sending side as
+	// MisdeliveredMessage system events, they usually indicate misconfigured
+	// RaftAddress values or stale membership entries pointing at reused
+	// addresses. All NodeHost instances must be running a version that supports
+	// misdelivery reports before TransportMisdeliveryReport is set.
+	TransportMisdeliveryReport bool
+	// Socket contains socket options applied to listeners of the built-in TCP
+	// transport module and the gossip service.
+	Socket SocketConfig
 	// Engine is the configuration for the execution engine.
 	Engine EngineConfig
+	// MaxConcurrentSnapshots is the maximum number of snapshots that can be
+	// saved concurrently by the NodeHost. Snapshots beyond the limit wait for
+	// their turn, their positions in the queue are reported by
+	// NodeHost.ExplainCompaction and NodeHostInfo. It limits the I/O caused by
+	// many shards reaching their SnapshotEntries thresholds at the same time,
+	// e.g. after a restart. When set to 0, the number of concurrent snapshots is
+	// only limited by Engine.SnapshotShards.
+	MaxConcurrentSnapshots uint64
+	// MaxConcurrentSnapshotRecoveries is the maximum number of replicas that can
+	// concurrently recover from snapshots. Recoveries are always scheduled
+	// ahead of waiting snapshot saves. When set to 0, the number of concurrent
+	// recoveries is only limited by Engine.SnapshotShards.
+	MaxConcurrentSnapshotRecoveries uint64
 	// LogDB contains configuration options for the LogDB storage engine. LogDB
 	// is used for storing Raft Logs and metadata. This optional option is used
 	// by advanced users for tuning the balance of I/O performance, memory and
@@ -957,9 +1927,189 @@ type ExpertConfig struct {
 	// TestGossipProbeInterval defines the probe interval used by the gossip
 	// service in tests.
 	TestGossipProbeInterval time.Duration
+	// GossipSeedResolver is the resolver used for resolving hostnames and DNS
+	// names in GossipConfig.Seed, net.DefaultResolver is used when it is not
+	// set.
+	GossipSeedResolver HostResolver
 	// NodeRegistryFactory defines a custom node registry function that can be used
 	// instead of a static registry or the built in memberlist gossip mechanism.
 	NodeRegistryFactory NodeRegistryFactory
+	// RegistryFactory is the factory used for creating the registry used for
+	// discovering NodeHost instances in the DefaultNodeRegistryEnabled mode. It
+	// allows NodeHost instances to be discovered using external services such
+	// as etcd or consul instead of the built-in gossip service, Gossip and
+	// StaticRegistry should not be set when RegistryFactory is set.
+	RegistryFactory RegistryFactory
+	// RegistryPublishInterval is the interval at which shard views of the
+	// NodeHost are published to the registry created by RegistryFactory. The
+	// default value of 1 second is used when it is set to 0.
+	RegistryPublishInterval time.Duration
+	// Resources is an optional handle of resources shared by NodeHost instances
+	// running in the same process, it is created by
+	// dragonboat.NewResourceGroup. Each NodeHost still requires its own
+	// NodeHostDir and NodeHostID.
+	Resources Resources
+	// Clock is the source of time used by the tick goroutine, and thus request
+	// timeouts, the snapshot interval scheduler, the gossip liveness probes
+	// and registry publishing. DefaultClock is used when it is not set. It is
+	// expected to be set in tests only, see the plugin/clocktest package.
+	// NodeHost instances with Resources set are ticked by the timer wheel of
+	// the ResourceGroup instead.
+	Clock Clock
+}
+
+// Clock is the interface used by NodeHost for getting the current time and
+// for waiting for time to elapse.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTicker returns a new Ticker delivering the current time on its
+	// channel every specified interval.
+	NewTicker(d time.Duration) Ticker
+	// After returns a channel on which the current time is delivered once
+	// the specified duration elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker is the interface of tickers returned by Clock.
+type Ticker interface {
+	// C returns the channel on which ticks are delivered.
+	C() <-chan time.Time
+	// Stop turns off the ticker, no more tick is delivered after Stop returns.
+	Stop()
+}
+
+// DefaultClock is the Clock backed by the system clock.
+var DefaultClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return &systemTicker{ticker: time.NewTicker(d)}
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *systemTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *systemTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// Resources is the interface of handles of resources shared by NodeHost
+// instances running in the same process, see dragonboat.NewResourceGroup.
+type Resources interface {
+	// Name returns the name of the resource group.
+	Name() string
+}
+
+// HostResolver is the interface used for resolving hostnames to IP addresses,
+// it is implemented by *net.Resolver.
+type HostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// SocketConfig contains socket options applied to listeners created by the
+// built-in TCP transport module and the gossip service. Operating system
+// defaults are used when SocketConfig is empty.
+type SocketConfig struct {
+	// ReusePort indicates whether the SO_REUSEPORT option should be set on
+	// listeners so multiple NodeHost processes can bind to the same address at
+	// the same time, e.g. when the old process is still draining during a
+	// blue/green restart. It is ignored on platforms other than Linux.
+	ReusePort bool
+	// DisableNoDelay indicates whether Nagle's algorithm should be enabled on
+	// transport connections. TCP_NODELAY is set on all transport connections
+	// when DisableNoDelay is false.
+	DisableNoDelay bool
+	// RecvBufferSize is the size of the socket receive buffer in bytes. The
+	// operating system default is used when RecvBufferSize is 0. It is ignored
+	// on platforms other than Linux.
+	RecvBufferSize int
+	// SendBufferSize is the size of the socket send buffer in bytes. The
+	// operating system default is used when SendBufferSize is 0. It is ignored
+	// on platforms other than Linux.
+	SendBufferSize int
+	// AcceptBacklog is the maximum length of the queue of pending connections
+	// of listeners. The operating system default is used when AcceptBacklog is
+	// 0. It is ignored on platforms other than Linux.
+	AcceptBacklog int
+}
+
+// IsEmpty returns a boolean flag indicating whether the SocketConfig instance
+// is empty.
+func (c *SocketConfig) IsEmpty() bool {
+	return reflect.DeepEqual(c, &SocketConfig{})
+}
+
+// Validate validates the SocketConfig instance.
+func (c *SocketConfig) Validate() error {
+	if c.RecvBufferSize < 0 {
+		return errors.New("invalid Expert.Socket.RecvBufferSize")
+	}
+	if c.SendBufferSize < 0 {
+		return errors.New("invalid Expert.Socket.SendBufferSize")
+	}
+	if c.AcceptBacklog < 0 {
+		return errors.New("invalid Expert.Socket.AcceptBacklog")
+	}
+	return nil
+}
+
+// DiskMonitorConfig contains options for monitoring the free disk space of
+// directories used by the NodeHost. Free space is checked every Interval, a
+// DiskSpaceLow system event is published when the free space of a monitored
+// directory drops below WarningFreeBytes. Once it drops below CriticalFreeBytes,
+// a DiskSpaceCritical system event is published and all affected replicas
+// reject new proposals with ErrDiskFull, they keep serving reads and applying
+// committed entries. Proposals are accepted again and a DiskSpaceRecovered
+// system event is published once the free space is above the thresholds
+// again. A low NodeHostDir or WALDir disk space affects all replicas on the
+// NodeHost, a low disk space of the data directory of an on disk state
+// machine only affects the replica of that state machine, see the
+// statemachine.IDataDir interface for details.
+type DiskMonitorConfig struct {
+	// Interval is the interval between two disk space checks.
+	Interval time.Duration
+	// WarningFreeBytes is the free disk space in bytes below which a
+	// DiskSpaceLow system event is published. The default value 0 disables
+	// such warnings.
+	WarningFreeBytes uint64
+	// CriticalFreeBytes is the free disk space in bytes below which proposals
+	// are rejected with ErrDiskFull.
+	CriticalFreeBytes uint64
+}
+
+// IsEmpty returns a boolean flag indicating whether the DiskMonitorConfig
+// instance is empty.
+func (c *DiskMonitorConfig) IsEmpty() bool {
+	return reflect.DeepEqual(c, &DiskMonitorConfig{})
+}
+
+// Validate validates the DiskMonitorConfig instance.
+func (c *DiskMonitorConfig) Validate() error {
+	if c.Interval <= 0 {
+		return errors.New("invalid DiskMonitor.Interval")
+	}
+	if c.CriticalFreeBytes == 0 {
+		return errors.New("DiskMonitor.CriticalFreeBytes not set")
+	}
+	if c.WarningFreeBytes > 0 && c.WarningFreeBytes <= c.CriticalFreeBytes {
+		return errors.New("DiskMonitor.WarningFreeBytes <= CriticalFreeBytes")
+	}
+	return nil
 }
 
 // GossipConfig contains configurations for the gossip service. Gossip service
@@ -983,18 +2133,79 @@ type GossipConfig struct {
 	// NodeHost instance will try to contact all of them to bootstrap the gossip
 	// service. At least one reachable NodeHost instance is required to
 	// successfully bootstrap the gossip service. Each seed address is in the
-	// format of IP:Port, Hostname:Port or DNS Name:Port.
+	// format of IP:Port, Hostname:Port or DNS Name:Port. A seed address can
+	// also be specified as dns:///DNS Name:Port, e.g. the name of a Kubernetes
+	// headless service. Hostnames and DNS names are re-resolved on each join
+	// attempt and all returned addresses are contacted.
 	//
 	// It is ok to include seed addresses that are temporarily unreachable, e.g.
 	// when launching the first NodeHost instance in your deployment, you can
 	// include AdvertiseAddresses from other NodeHost instances that you plan to
 	// launch shortly afterwards.
 	Seed []string
+	// JoinTimeout is the overall time budget for joining the gossip group when
+	// the NodeHost instance is created. Failed join attempts are retried with
+	// exponential backoff until JoinTimeout expires, NewNodeHost then fails
+	// with the ErrGossipJoinFailed error unless ContinueOnJoinFailure is set.
+	// The default value 0 means that only one join attempt is made and the
+	// NodeHost instance is created regardless of its outcome.
+	//
+	// The local gossip service is considered as joined when it knows at least
+	// one other live member of the gossip group.
+	JoinTimeout time.Duration
+	// ContinueOnJoinFailure indicates whether the NodeHost instance should be
+	// created in isolated mode when the gossip group can not be joined within
+	// JoinTimeout. Isolated gossip services keep trying to join the gossip
+	// group in the background, a GossipIsolated system event is published
+	// when entering the isolated mode.
+	ContinueOnJoinFailure bool
+	// SuspectGracePeriod enables health aware resolution of NodeHostID
+	// targets when it is set to a positive value. NodeHost instances recently
+	// used as message targets are probed by the local gossip service when they
+	// have been silent for a gossip probe interval, those failing to respond
+	// are considered as suspect. Once a NodeHost instance has been suspect or
+	// dead for longer than SuspectGracePeriod, messages to replicas running on
+	// it are dropped without dialing it and a NodeHostSuspected system event
+	// is published. Normal message delivery resumes and a NodeHostRecovered
+	// system event is published once it is observed as alive again.
+	//
+	// Dropping such messages doesn't affect correctness as Raft tolerates
+	// unreachable peers, it only reduces wasted connection attempts. The
+	// default value 0 disables this feature.
+	SuspectGracePeriod time.Duration
 	// Meta is the extra metadata to be included in gossip node's Meta field. It
 	// will be propagated to all other NodeHost instances via gossip.
 	Meta []byte
+	// Tags are application defined key value pairs describing the NodeHost,
+	// e.g. its zone, rack or capacity class. Tags are propagated to all other
+	// NodeHost instances via gossip, they can be queried using the
+	// GetNodeHostTags method of the registry returned by NodeHost's
+	// GetNodeHostRegistry method and updated at runtime using NodeHost's
+	// UpdateGossipTags method. The total size of all keys and values can not
+	// exceed MaxGossipTagsSize bytes.
+	Tags map[string]string
+	// Keys are the keys used for encrypting gossip messages. The first key is
+	// the primary key used for encrypting outgoing messages, all keys are
+	// accepted when decrypting incoming messages. Each key must be 16, 24 or
+	// 32 bytes long to select AES-128, AES-192 or AES-256. When Keys is empty,
+	// a key derived from NodeHostConfig.TransportAuthToken is used if it is
+	// set.
+	//
+	// Keys can be rotated without restarting NodeHost instances. Add the new
+	// key on all NodeHost instances using NodeHost's AddGossipKey method, then
+	// make it the primary key on all NodeHost instances using UseGossipKey,
+	// finally remove the old key everywhere using RemoveGossipKey.
+	Keys [][]byte
 }
 
+// GossipDNSSeedPrefix is the prefix of GossipConfig.Seed addresses that
+// should be resolved using DNS.
+const GossipDNSSeedPrefix = "dns:///"
+
+// MaxGossipTagsSize is the maximum total size in bytes of all keys and values
+// of GossipConfig.Tags.
+const MaxGossipTagsSize = 256
+
 // IsEmpty returns a boolean flag indicating whether the GossipConfig instance
 // is empty.
 func (g *GossipConfig) IsEmpty() bool {
@@ -1020,13 +2231,78 @@ func (g *GossipConfig) Validate() error {
 		if v != g.BindAddress && v != g.AdvertiseAddress {
 			count++
 		}
-		if !stringutil.IsValidAddress(v) {
+		if !stringutil.IsValidAddress(strings.TrimPrefix(v, GossipDNSSeedPrefix)) {
 			return errors.New("invalid GossipConfig.Seed value")
 		}
 	}
 	if count == 0 {
 		return errors.New("no valid seed node")
 	}
+	if g.JoinTimeout < 0 {
+		return errors.New("invalid GossipConfig.JoinTimeout")
+	}
+	if g.SuspectGracePeriod < 0 {
+		return errors.New("invalid GossipConfig.SuspectGracePeriod")
+	}
+	sz := 0
+	for k, v := range g.Tags {
+		if len(k) == 0 {
+			return errors.New("empty GossipConfig.Tags key")
+		}
+		sz += len(k) + len(v)
+	}
+	if sz > MaxGossipTagsSize {
+		return errors.New("GossipConfig.Tags is too big")
+	}
+	for _, key := range g.Keys {
+		if l := len(key); l != 16 && l != 24 && l != 32 {
+			return errors.New("invalid GossipConfig.Keys length")
+		}
+	}
+	return nil
+}
+
+// StaticRegistryConfig contains configurations for the static node registry.
+// The static node registry loads NodeHostID to RaftAddress mappings of known
+// NodeHost instances from a JSON or YAML file, it is intended for environments
+// in which the gossip service can not be used.
+//
+// The file is parsed as YAML when it has the .yaml or .yml extension, it is
+// parsed as JSON otherwise. An example of the JSON format is shown below, the
+// meta field is optional and can be queried using the GetMeta method of the
+// INodeHostRegistry instance returned by NodeHost's GetNodeHostRegistry method.
+//
+//	{
+//	  "nodehosts": [
+//	    {
+//	      "nodehost_id": "nhid-12345",
+//	      "raft_address": "myhostname1:24000",
+//	      "meta": "rack-1"
+//	    }
+//	  ]
+//	}
+type StaticRegistryConfig struct {
+	// File is the path of the file containing NodeHostID to RaftAddress
+	// mappings.
+	File string
+	// ReloadInterval is the interval at which the modification time of File is
+	// checked, File is reloaded once it is changed. Setting ReloadInterval to 0
+	// disables such polling, NodeHost's ReloadRegistry method can still be used
+	// to reload File explicitly.
+	ReloadInterval time.Duration
+}
+
+// IsEmpty returns a boolean flag indicating whether the StaticRegistryConfig
+// instance is empty.
+func (c *StaticRegistryConfig) IsEmpty() bool {
+	return len(c.File) == 0
+}
+
+// Validate validates the StaticRegistryConfig instance.
+func (c *StaticRegistryConfig) Validate() error {
+	if c.ReloadInterval < 0 {
+		return errors.New("invalid StaticRegistry.ReloadInterval")
+	}
 	return nil
 }
 
@@ -16,7 +16,9 @@ package config
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/lni/dragonboat/v4/raftio"
 )
@@ -66,6 +68,101 @@ func TestListenAddress(t *testing.T) {
 	}
 }
 
+func TestListenAddresses(t *testing.T) {
+	nhc := NodeHostConfig{
+		RaftAddress: "raft.address:23456",
+	}
+	if v := nhc.GetListenAddresses(); !reflect.DeepEqual(v, []string{nhc.RaftAddress}) {
+		t.Errorf("unexpected listen addresses %v", v)
+	}
+	nhc.ListenAddresses = []string{"0.0.0.0:12345", "[::]:12345"}
+	if v := nhc.GetListenAddresses(); !reflect.DeepEqual(v, nhc.ListenAddresses) {
+		t.Errorf("unexpected listen addresses %v", v)
+	}
+	if nhc.GetListenAddress() != "0.0.0.0:12345" {
+		t.Errorf("unexpected listen address %s", nhc.GetListenAddress())
+	}
+}
+
+func TestListenAddressesAreValidated(t *testing.T) {
+	tests := []struct {
+		listenAddress   string
+		listenAddresses []string
+		ok              bool
+	}{
+		{"", []string{"0.0.0.0:9010", "[::]:9010"}, true},
+		{"", []string{"[::1]:9020"}, true},
+		{"", []string{"localhost:9020"}, true},
+		{"localhost:9020", []string{"[::]:9010"}, false},
+		{"", []string{"[::]"}, false},
+		{"", []string{"[::]:0"}, false},
+		{"", []string{"[1.2.3.4]:9010"}, false},
+		{"", []string{"::1:9010"}, false},
+	}
+	for idx, tt := range tests {
+		c := NodeHostConfig{
+			RaftAddress:     "localhost:9010",
+			RTTMillisecond:  100,
+			NodeHostDir:     "/data",
+			ListenAddress:   tt.listenAddress,
+			ListenAddresses: tt.listenAddresses,
+		}
+		if err := c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected validation result %v", idx, err)
+		}
+	}
+}
+
+func TestTransportAuthOptionsAreValidated(t *testing.T) {
+	tests := []struct {
+		token string
+		allow bool
+		ok    bool
+	}{
+		{"", false, true},
+		{"secret", false, true},
+		{"secret", true, true},
+		{"", true, false},
+	}
+	for idx, tt := range tests {
+		c := NodeHostConfig{
+			RaftAddress:                   "localhost:9010",
+			RTTMillisecond:                100,
+			NodeHostDir:                   "/data",
+			TransportAuthToken:            tt.token,
+			AllowUnauthenticatedTransport: tt.allow,
+		}
+		if err := c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected validation result %v", idx, err)
+		}
+	}
+}
+
+func TestSocketOptionsAreValidated(t *testing.T) {
+	tests := []struct {
+		sc SocketConfig
+		ok bool
+	}{
+		{SocketConfig{}, true},
+		{SocketConfig{ReusePort: true, RecvBufferSize: 1024,
+			SendBufferSize: 1024, AcceptBacklog: 128}, true},
+		{SocketConfig{RecvBufferSize: -1}, false},
+		{SocketConfig{SendBufferSize: -1}, false},
+		{SocketConfig{AcceptBacklog: -1}, false},
+	}
+	for idx, tt := range tests {
+		c := NodeHostConfig{
+			RaftAddress:    "localhost:9010",
+			RTTMillisecond: 100,
+			NodeHostDir:    "/data",
+		}
+		c.Expert.Socket = tt.sc
+		if err := c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected validation result %v", idx, err)
+		}
+	}
+}
+
 func TestIsValidAddress(t *testing.T) {
 	va := []string{
 		"192.0.0.1:12345",
@@ -114,11 +211,194 @@ func TestWitnessNodeCanNotBeNonVoting(t *testing.T) {
 	}
 }
 
+func TestStandbyNodeMustBeNonVoting(t *testing.T) {
+	cfg := Config{ReplicaID: 1, HeartbeatRTT: 1, ElectionRTT: 10, Standby: true}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("standby node must be a non-voting node")
+	}
+	cfg.IsNonVoting = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("failed to validate %v", err)
+	}
+}
+
 func TestWitnessCanNotTakeSnapshot(t *testing.T) {
 	cfg := Config{IsWitness: true, SnapshotEntries: 100}
 	if err := cfg.Validate(); err == nil {
 		t.Fatalf("witness node can not take snapshot")
 	}
+	cfg = Config{IsWitness: true, SnapshotIntervalSeconds: 60}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("witness node can not take snapshot")
+	}
+	cfg = Config{IsWitness: true, SnapshotOnMembershipChange: true}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("witness node can not take snapshot")
+	}
+}
+
+func TestCompactionGraceTicksAreValidated(t *testing.T) {
+	cfg := Config{ReplicaID: 1, HeartbeatRTT: 1, ElectionRTT: 10,
+		CompactionLaggardGraceTicks:      100,
+		CompactionDeadFollowerGraceTicks: 10,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	cfg.CompactionDeadFollowerGraceTicks = 101
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("dead follower grace larger than laggard grace accepted")
+	}
+}
+
+func TestTraceSampleRatioIsValidated(t *testing.T) {
+	for _, ratio := range []float64{-0.1, 1.1} {
+		cfg := Config{ReplicaID: 1, HeartbeatRTT: 1, ElectionRTT: 10,
+			TraceSampleRatio: ratio}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("invalid TraceSampleRatio %f accepted", ratio)
+		}
+	}
+	cfg := Config{ReplicaID: 1, HeartbeatRTT: 1, ElectionRTT: 10,
+		TraceSampleRatio: 0.5}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("valid TraceSampleRatio rejected, %v", err)
+	}
+}
+
+func TestDegradedLeaderThresholdIsValidated(t *testing.T) {
+	cfg := Config{ReplicaID: 1, HeartbeatRTT: 1, ElectionRTT: 10,
+		DegradedLeaderThreshold: -time.Second}
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("negative DegradedLeaderThreshold accepted")
+	}
+	cfg.DegradedLeaderThreshold = time.Second
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("valid DegradedLeaderThreshold rejected, %v", err)
+	}
+}
+
+func TestMaxRemovedReplicasIsValidated(t *testing.T) {
+	cfg := Config{ReplicaID: 1, HeartbeatRTT: 1, ElectionRTT: 10,
+		MaxRemovedReplicas: 4097}
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("too large MaxRemovedReplicas accepted")
+	}
+	cfg.MaxRemovedReplicas = 4096
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("valid MaxRemovedReplicas rejected, %v", err)
+	}
+}
+
+func TestQuiesceThresholdIsValidated(t *testing.T) {
+	tests := []struct {
+		quiesce   bool
+		threshold uint64
+		ok        bool
+	}{
+		{false, 0, true},
+		{true, 0, true},
+		{false, 100, false},
+		{true, 19, false},
+		{true, 20, true},
+	}
+	for idx, tt := range tests {
+		cfg := Config{ReplicaID: 1, HeartbeatRTT: 1, ElectionRTT: 10,
+			Quiesce: tt.quiesce, QuiesceThreshold: tt.threshold}
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected result %v", idx, err)
+		}
+	}
+}
+
+func TestTimingsAreValidated(t *testing.T) {
+	tests := []struct {
+		election  time.Duration
+		heartbeat time.Duration
+		ok        bool
+	}{
+		{time.Second, 0, false},
+		{0, 100 * time.Millisecond, false},
+		{200 * time.Millisecond, 100 * time.Millisecond, false},
+		{time.Second, -time.Millisecond, false},
+		{time.Second, 100 * time.Millisecond, true},
+	}
+	for idx, tt := range tests {
+		cfg := Config{ReplicaID: 1,
+			ElectionTimeout: tt.election, HeartbeatInterval: tt.heartbeat}
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected result %v", idx, err)
+		}
+	}
+}
+
+func TestTimingTicksAreSet(t *testing.T) {
+	tests := []struct {
+		rtt       uint64
+		election  uint64
+		heartbeat uint64
+		ok        bool
+	}{
+		{0, 0, 0, false},
+		{1, 1000, 100, true},
+		{30, 34, 3, true},
+		{200, 5, 1, true},
+		{500, 0, 0, false},
+	}
+	for idx, tt := range tests {
+		cfg := Config{ReplicaID: 1, ElectionTimeout: time.Second,
+			HeartbeatInterval: 100 * time.Millisecond}
+		err := cfg.SetTimingTicks(tt.rtt)
+		if (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected result %v", idx, err)
+		}
+		if err == nil && (cfg.ElectionRTT != tt.election ||
+			cfg.HeartbeatRTT != tt.heartbeat || cfg.Validate() != nil) {
+			t.Errorf("%d, unexpected ticks %d, %d",
+				idx, cfg.ElectionRTT, cfg.HeartbeatRTT)
+		}
+	}
+	cfg := Config{ReplicaID: 1, HeartbeatRTT: 1, ElectionRTT: 10}
+	if err := cfg.SetTimingTicks(0); err != nil ||
+		cfg.ElectionRTT != 10 || cfg.HeartbeatRTT != 1 {
+		t.Errorf("unexpected result %v", err)
+	}
+}
+
+func TestWriteFsyncModeIsValidated(t *testing.T) {
+	tests := []struct {
+		mode WriteFsyncMode
+		ok   bool
+	}{
+		{StrictFsync, true},
+		{RelaxedFsync, true},
+		{RelaxedFsync + 1, false},
+	}
+	for idx, tt := range tests {
+		cfg := Config{ReplicaID: 1, HeartbeatRTT: 1, ElectionRTT: 10,
+			WriteFsyncMode: tt.mode}
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected result %v", idx, err)
+		}
+	}
+}
+
+func TestStorageClassIsValidated(t *testing.T) {
+	tests := []struct {
+		class StorageClass
+		ok    bool
+	}{
+		{Durable, true},
+		{Volatile, true},
+		{Volatile + 1, false},
+	}
+	for idx, tt := range tests {
+		cfg := Config{ReplicaID: 1, HeartbeatRTT: 1, ElectionRTT: 10,
+			StorageClass: tt.class}
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected result %v", idx, err)
+		}
+	}
 }
 
 func TestLogDBConfigIsEmpty(t *testing.T) {
@@ -214,6 +494,219 @@ func TestGossipMustBeConfiguredWhenDefaultNodeRegistryEnabled(t *testing.T) {
 	}
 }
 
+func TestStaticRegistryConfigIsValidated(t *testing.T) {
+	gossip := GossipConfig{
+		BindAddress: "localhost:12345",
+		Seed:        []string{"localhost:23456"},
+	}
+	static := StaticRegistryConfig{File: "/data/registry.json"}
+	tests := []struct {
+		enabled  bool
+		gossip   GossipConfig
+		static   StaticRegistryConfig
+		interval time.Duration
+		ok       bool
+	}{
+		{true, GossipConfig{}, static, 0, true},
+		{true, GossipConfig{}, static, time.Second, true},
+		{true, GossipConfig{}, static, -time.Second, false},
+		{false, GossipConfig{}, static, 0, false},
+		{true, gossip, static, 0, false},
+		{true, GossipConfig{}, StaticRegistryConfig{}, 0, false},
+	}
+	for idx, tt := range tests {
+		c := NodeHostConfig{
+			RaftAddress:                "localhost:9010",
+			RTTMillisecond:             100,
+			NodeHostDir:                "/data",
+			DefaultNodeRegistryEnabled: tt.enabled,
+			Gossip:                     tt.gossip,
+			StaticRegistry:             tt.static,
+		}
+		c.StaticRegistry.ReloadInterval = tt.interval
+		if err := c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected result %v", idx, err)
+		}
+	}
+}
+
+type testRegistryFactory struct{}
+
+func (testRegistryFactory) Create(NodeHostConfig,
+	string) (raftio.IRegistry, error) {
+	return nil, nil
+}
+
+func TestRegistryFactoryIsValidated(t *testing.T) {
+	tests := []struct {
+		f  func(*NodeHostConfig)
+		ok bool
+	}{
+		{func(c *NodeHostConfig) {}, true},
+		{func(c *NodeHostConfig) { c.DefaultNodeRegistryEnabled = false }, false},
+		{func(c *NodeHostConfig) {
+			c.StaticRegistry = StaticRegistryConfig{File: "/data/registry.json"}
+		}, false},
+		{func(c *NodeHostConfig) {
+			c.Gossip = GossipConfig{
+				BindAddress: "localhost:12345",
+				Seed:        []string{"localhost:23456"},
+			}
+		}, false},
+		{func(c *NodeHostConfig) { c.Expert.RegistryPublishInterval = -1 }, false},
+	}
+	for idx, tt := range tests {
+		c := NodeHostConfig{
+			RaftAddress:                "localhost:9010",
+			RTTMillisecond:             100,
+			NodeHostDir:                "/data",
+			DefaultNodeRegistryEnabled: true,
+			Expert:                     ExpertConfig{RegistryFactory: testRegistryFactory{}},
+		}
+		tt.f(&c)
+		if err := c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected result %v", idx, err)
+		}
+	}
+	c := NodeHostConfig{Expert: ExpertConfig{RegistryFactory: testRegistryFactory{}}}
+	if err := c.Prepare(); err != nil {
+		t.Fatalf("prepare failed %v", err)
+	}
+	if c.Expert.RegistryPublishInterval != time.Second {
+		t.Errorf("default RegistryPublishInterval not set")
+	}
+}
+
+func TestGossipTagsAreValidated(t *testing.T) {
+	tests := []struct {
+		tags map[string]string
+		ok   bool
+	}{
+		{nil, true},
+		{map[string]string{"zone": "a", "rack": ""}, true},
+		{map[string]string{"": "a"}, false},
+		{map[string]string{"zone": strings.Repeat("a", MaxGossipTagsSize-4)}, true},
+		{map[string]string{"zone": strings.Repeat("a", MaxGossipTagsSize-3)}, false},
+	}
+	for idx, tt := range tests {
+		gc := GossipConfig{
+			BindAddress: "localhost:12345",
+			Seed:        []string{"localhost:23456"},
+			Tags:        tt.tags,
+		}
+		if err := gc.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected result %v", idx, err)
+		}
+	}
+}
+
+func TestTransportExpertOptionsAreValidated(t *testing.T) {
+	tests := []struct {
+		f  func(*ExpertConfig)
+		ok bool
+	}{
+		{func(c *ExpertConfig) {}, true},
+		{func(c *ExpertConfig) { c.TransportDrainTimeout = time.Second }, true},
+		{func(c *ExpertConfig) { c.TransportDrainTimeout = -time.Second }, false},
+		{func(c *ExpertConfig) { c.TransportKeepAliveInterval = time.Second }, true},
+		{func(c *ExpertConfig) { c.TransportKeepAliveInterval = -time.Second }, false},
+		{func(c *ExpertConfig) { c.TransportKeepAliveCount = 3 }, true},
+		{func(c *ExpertConfig) { c.TransportKeepAliveCount = -1 }, false},
+		{func(c *ExpertConfig) { c.TransportPingInterval = time.Second }, true},
+		{func(c *ExpertConfig) { c.TransportPingInterval = -time.Second }, false},
+		{func(c *ExpertConfig) { c.MaxSendStallDuration = time.Second }, true},
+		{func(c *ExpertConfig) { c.MaxSendStallDuration = -time.Second }, false},
+	}
+	for idx, tt := range tests {
+		c := NodeHostConfig{
+			RaftAddress:    "localhost:9010",
+			RTTMillisecond: 100,
+			NodeHostDir:    "/data",
+		}
+		tt.f(&c.Expert)
+		if err := c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected validation result %v", idx, err)
+		}
+	}
+}
+
+func TestApplyStallThresholdIsValidated(t *testing.T) {
+	for idx, tt := range []struct {
+		threshold time.Duration
+		ok        bool
+	}{{0, true}, {time.Second, true}, {-time.Second, false}} {
+		c := NodeHostConfig{
+			RaftAddress:         "localhost:9010",
+			RTTMillisecond:      100,
+			NodeHostDir:         "/data",
+			ApplyStallThreshold: tt.threshold,
+		}
+		if err := c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected validation result %v", idx, err)
+		}
+	}
+}
+
+func TestHistoricalReadCacheTTLIsValidated(t *testing.T) {
+	for idx, tt := range []struct {
+		ttl time.Duration
+		ok  bool
+	}{{0, true}, {time.Second, true}, {-time.Second, false}} {
+		c := NodeHostConfig{
+			RaftAddress:            "localhost:9010",
+			RTTMillisecond:         100,
+			NodeHostDir:            "/data",
+			HistoricalReadCacheTTL: tt.ttl,
+		}
+		if err := c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected validation result %v", idx, err)
+		}
+	}
+}
+
+func TestMaxMemoryBytesIsValidated(t *testing.T) {
+	for idx, tt := range []struct {
+		maxMemoryBytes uint64
+		ok             bool
+	}{{0, true}, {1, false}, {1024 * 1024, true}} {
+		c := NodeHostConfig{
+			RaftAddress:    "localhost:9010",
+			RTTMillisecond: 100,
+			NodeHostDir:    "/data",
+			MaxMemoryBytes: tt.maxMemoryBytes,
+		}
+		if err := c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected validation result %v", idx, err)
+		}
+	}
+}
+
+func TestDiskMonitorConfigIsValidated(t *testing.T) {
+	for idx, tt := range []struct {
+		cfg DiskMonitorConfig
+		ok  bool
+	}{
+		{DiskMonitorConfig{}, true},
+		{DiskMonitorConfig{Interval: time.Second, CriticalFreeBytes: 1}, true},
+		{DiskMonitorConfig{Interval: time.Second,
+			WarningFreeBytes: 2, CriticalFreeBytes: 1}, true},
+		{DiskMonitorConfig{CriticalFreeBytes: 1}, false},
+		{DiskMonitorConfig{Interval: time.Second}, false},
+		{DiskMonitorConfig{Interval: time.Second,
+			WarningFreeBytes: 1, CriticalFreeBytes: 1}, false},
+	} {
+		c := NodeHostConfig{
+			RaftAddress:    "localhost:9010",
+			RTTMillisecond: 100,
+			NodeHostDir:    "/data",
+			DiskMonitor:    tt.cfg,
+		}
+		if err := c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected validation result %v", idx, err)
+		}
+	}
+}
+
 func TestGossipConfigIsEmtpy(t *testing.T) {
 	gc := &GossipConfig{}
 	if !gc.IsEmpty() {
@@ -275,6 +768,9 @@ func TestGossipConfigValidate(t *testing.T) {
 		{"myhost.com:12345", "202.23.45.1::12345", []string{"128.0.0.1:12345"}, false},
 		{"myhost.com::12345", "202.23.45.1:12345", []string{"128.0.0.1:12345"}, false},
 		{"node1:12345", "202.96.23.1:12345", []string{"node3:12345", "node4:12345"}, true},
+		{"node1:12345", "202.96.23.1:12345", []string{"dns:///svc.ns.svc:12345"}, true},
+		{"node1:12345", "202.96.23.1:12345", []string{"dns:///svc.ns.svc"}, false},
+		{"node1:12345", "202.96.23.1:12345", []string{"dns://svc.ns.svc:12345"}, false},
 	}
 	for idx, tt := range tests {
 		gc := &GossipConfig{
@@ -289,6 +785,51 @@ func TestGossipConfigValidate(t *testing.T) {
 	}
 }
 
+func TestGossipKeysAreValidated(t *testing.T) {
+	gc := &GossipConfig{
+		BindAddress: "node1:12345",
+		Seed:        []string{"node2:12345"},
+		Keys:        [][]byte{make([]byte, 16), make([]byte, 24), make([]byte, 32)},
+	}
+	if err := gc.Validate(); err != nil {
+		t.Errorf("valid keys rejected, %v", err)
+	}
+	gc.Keys = append(gc.Keys, make([]byte, 20))
+	if err := gc.Validate(); err == nil {
+		t.Errorf("invalid key not rejected")
+	}
+}
+
+func TestGossipJoinTimeoutIsValidated(t *testing.T) {
+	gc := &GossipConfig{
+		BindAddress: "node1:12345",
+		Seed:        []string{"dns:///svc.ns.svc:12345"},
+		JoinTimeout: -time.Second,
+	}
+	if err := gc.Validate(); err == nil {
+		t.Errorf("negative JoinTimeout not rejected")
+	}
+	gc.JoinTimeout = time.Second
+	if err := gc.Validate(); err != nil {
+		t.Errorf("valid JoinTimeout rejected, %v", err)
+	}
+}
+
+func TestGossipSuspectGracePeriodIsValidated(t *testing.T) {
+	gc := &GossipConfig{
+		BindAddress:        "node1:12345",
+		Seed:               []string{"node2:12345"},
+		SuspectGracePeriod: -time.Second,
+	}
+	if err := gc.Validate(); err == nil {
+		t.Errorf("negative SuspectGracePeriod not rejected")
+	}
+	gc.SuspectGracePeriod = time.Second
+	if err := gc.Validate(); err != nil {
+		t.Errorf("valid SuspectGracePeriod rejected, %v", err)
+	}
+}
+
 func TestDefaultEngineConfig(t *testing.T) {
 	nhc := &NodeHostConfig{}
 	if err := nhc.Prepare(); err != nil {
@@ -299,3 +840,56 @@ func TestDefaultEngineConfig(t *testing.T) {
 		t.Errorf("default engine configure not set")
 	}
 }
+
+func TestEngineConfigSendQueueOptionsAreValidated(t *testing.T) {
+	tests := []struct {
+		bytes   uint64
+		policy  SendQueueOverflowPolicy
+		timeout uint64
+		ok      bool
+	}{
+		{0, DropNewest, 0, true},
+		{1, DropNewest, 0, false},
+		{1024 * 1024, DropOldestNonCritical, 0, true},
+		{0, BlockWithDeadline, 0, false},
+		{0, BlockWithDeadline, 100, true},
+		{0, BlockWithDeadline + 1, 100, false},
+	}
+	for idx, tt := range tests {
+		ec := GetDefaultEngineConfig()
+		ec.SendQueueBytes = tt.bytes
+		ec.SendQueueOverflowPolicy = tt.policy
+		ec.SendQueueBlockTimeoutMS = tt.timeout
+		if err := ec.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected validation result %v", idx, err)
+		}
+	}
+}
+
+func TestEngineConfigReadBatchDelayIsValidated(t *testing.T) {
+	ec := GetDefaultEngineConfig()
+	ec.ReadBatchDelay = 5 * time.Millisecond
+	if err := ec.Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	ec.ReadBatchDelay = -1
+	if err := ec.Validate(); err == nil {
+		t.Errorf("negative ReadBatchDelay not rejected")
+	}
+}
+
+func TestNodeHostIDIsValidated(t *testing.T) {
+	c := NodeHostConfig{
+		RaftAddress:    "localhost:9010",
+		RTTMillisecond: 100,
+		NodeHostDir:    "/data",
+		NodeHostID:     "nhid-12345",
+	}
+	if err := c.Validate(); err == nil {
+		t.Errorf("invalid NodeHostID not rejected")
+	}
+	c.NodeHostID = "123e4567-e89b-12d3-a456-426614174000"
+	if err := c.Validate(); err != nil {
+		t.Errorf("valid NodeHostID rejected, %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/raft"
+	"github.com/lni/dragonboat/v4/internal/server"
+)
+
+const (
+	degradedUpdate = "Update"
+	degradedLogDB  = "LogDB"
+	// defaultDegradedLeaderCooldownFactor is the default cooldown period in
+	// the number of election timeouts.
+	defaultDegradedLeaderCooldownFactor uint64 = 10
+)
+
+// degradedLeaderDetector tracks the latencies of Update invocations and LogDB
+// saves of a replica. On each tick, the latencies observed since the previous
+// tick, including those of operations still in progress, are checked against
+// the threshold. A tick is slow when any such latency exceeds the threshold
+// and healthy when only fast operations completed, ticks without any observed
+// operation change nothing. All methods can be invoked on a nil
+// degradedLeaderDetector, nothing is recorded in that case.
+type degradedLeaderDetector struct {
+	mu          sync.Mutex
+	threshold   time.Duration
+	updateStart time.Time
+	diskStart   time.Time
+	slowest     time.Duration
+	slowestOp   string
+	fast        bool
+	// fields below are only accessed on ticks with raftMu held
+	required  uint64
+	cooldown  uint64
+	ticks     uint64
+	lastEvent uint64
+}
+
+// newDegradedLeaderDetector returns the detector of the specified replica,
+// nil is returned when DegradedLeaderThreshold is not set.
+func newDegradedLeaderDetector(cfg config.Config) *degradedLeaderDetector {
+	if cfg.DegradedLeaderThreshold == 0 {
+		return nil
+	}
+	d := &degradedLeaderDetector{
+		threshold: cfg.DegradedLeaderThreshold,
+		required:  cfg.DegradedLeaderRTT,
+		cooldown:  cfg.DegradedLeaderCooldownRTT,
+	}
+	if d.required == 0 {
+		d.required = cfg.ElectionRTT
+	}
+	if d.cooldown == 0 {
+		d.cooldown = cfg.ElectionRTT * defaultDegradedLeaderCooldownFactor
+	}
+	return d
+}
+
+// updateStarted records the start of an Update invocation.
+func (d *degradedLeaderDetector) updateStarted() time.Time {
+	if d == nil {
+		return time.Time{}
+	}
+	now := time.Now()
+	d.mu.Lock()
+	d.updateStart = now
+	d.mu.Unlock()
+	return now
+}
+
+// updateDone records the completion of the Update invocation started at the
+// specified time.
+func (d *degradedLeaderDetector) updateDone(start time.Time) {
+	if d == nil {
+		return
+	}
+	elapsed := time.Since(start)
+	d.mu.Lock()
+	d.updateStart = time.Time{}
+	d.observe(degradedUpdate, elapsed)
+	d.mu.Unlock()
+}
+
+// diskStarted records the start of a LogDB save.
+func (d *degradedLeaderDetector) diskStarted(start time.Time) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.diskStart = start
+	d.mu.Unlock()
+}
+
+// diskSaved records the completion of a LogDB save of the specified duration.
+func (d *degradedLeaderDetector) diskSaved(elapsed time.Duration) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.diskStart = time.Time{}
+	d.observe(degradedLogDB, elapsed)
+	d.mu.Unlock()
+}
+
+func (d *degradedLeaderDetector) observe(op string, elapsed time.Duration) {
+	if elapsed > d.threshold {
+		if elapsed > d.slowest {
+			d.slowest = elapsed
+			d.slowestOp = op
+		}
+	} else {
+		d.fast = true
+	}
+}
+
+// sample returns the slowest operation and its latency observed since the
+// last sample, operations still in progress are included. The returned
+// boolean values indicate whether the latency exceeds the threshold and
+// whether only fast operations were observed.
+func (d *degradedLeaderDetector) sample() (string, time.Duration, bool, bool) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.updateStart.IsZero() {
+		if elapsed := now.Sub(d.updateStart); elapsed > d.threshold {
+			d.observe(degradedUpdate, elapsed)
+		}
+	}
+	if !d.diskStart.IsZero() {
+		if elapsed := now.Sub(d.diskStart); elapsed > d.threshold {
+			d.observe(degradedLogDB, elapsed)
+		}
+	}
+	op, latency, fast := d.slowestOp, d.slowest, d.fast
+	d.slowestOp, d.slowest, d.fast = "", 0, false
+	return op, latency, latency > 0, fast
+}
+
+func (d *degradedLeaderDetector) eventAllowed(tick uint64) bool {
+	return d.lastEvent == 0 || tick-d.lastEvent >= d.cooldown
+}
+
+// checkDegradedLeader is invoked on each tick with the raftMu held, it
+// publishes a LeaderDegraded event and hands off the leadership to a healthy
+// and caught up replica when the latency of the leader kept exceeding the
+// threshold for the required number of ticks.
+func (n *node) checkDegradedLeader() error {
+	d := n.degraded
+	if d == nil {
+		return nil
+	}
+	op, latency, slow, fast := d.sample()
+	// latencies are not representative when a snapshot is being saved,
+	// recovered or streamed
+	if !n.isLeader() || n.ss.saving() || n.ss.recovering() || n.ss.streaming() {
+		d.ticks = 0
+		return nil
+	}
+	if !slow {
+		if fast {
+			d.ticks = 0
+		}
+		return nil
+	}
+	d.ticks++
+	if d.ticks < d.required || !d.eventAllowed(n.currentTick) {
+		return nil
+	}
+	ticks := d.ticks
+	d.ticks = 0
+	d.lastEvent = n.currentTick
+	target := n.p.GetHandoffTarget()
+	if target != raft.NoNode {
+		plog.Warningf("%s degraded, slow %s took %s, transferring leadership to %s",
+			n.id(), op, latency, dn(n.shardID, target))
+	} else {
+		plog.Warningf("%s degraded, slow %s took %s, no healthy replica",
+			n.id(), op, latency)
+	}
+	n.sysEvents.Publish(server.SystemEvent{
+		Type:      server.LeaderDegraded,
+		ShardID:   n.shardID,
+		ReplicaID: n.replicaID,
+		Callback:  op,
+		Duration:  latency,
+		Ticks:     ticks,
+		Target:    target,
+	})
+	if target == raft.NoNode {
+		return nil
+	}
+	return n.p.RequestLeaderTransfer(target)
+}
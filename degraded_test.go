@@ -0,0 +1,286 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/goutils/leaktest"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	"github.com/lni/dragonboat/v4/raftio"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func TestDegradedLeaderDetectorSamplesLatencies(t *testing.T) {
+	d := newDegradedLeaderDetector(config.Config{
+		ElectionRTT:             10,
+		DegradedLeaderThreshold: time.Hour,
+	})
+	if d.required != 10 || d.cooldown != 100 {
+		t.Errorf("unexpected defaults %d, %d", d.required, d.cooldown)
+	}
+	if _, _, slow, fast := d.sample(); slow || fast {
+		t.Errorf("unexpected sample when idle")
+	}
+	d.updateDone(d.updateStarted())
+	if _, _, slow, fast := d.sample(); slow || !fast {
+		t.Errorf("fast update not sampled")
+	}
+	d.threshold = time.Millisecond
+	d.diskSaved(time.Second)
+	d.updateDone(d.updateStarted())
+	op, latency, slow, _ := d.sample()
+	if !slow || op != degradedLogDB || latency != time.Second {
+		t.Errorf("unexpected sample %s, %s, %t", op, latency, slow)
+	}
+	// operations still in progress are sampled
+	d.updateStarted()
+	time.Sleep(2 * time.Millisecond)
+	if op, _, slow, _ := d.sample(); !slow || op != degradedUpdate {
+		t.Errorf("slow update in progress not sampled, %s", op)
+	}
+	if newDegradedLeaderDetector(config.Config{ElectionRTT: 10}) != nil {
+		t.Errorf("detector created when disabled")
+	}
+	var nd *degradedLeaderDetector
+	nd.updateDone(nd.updateStarted())
+	nd.diskStarted(time.Now())
+	nd.diskSaved(time.Second)
+}
+
+func TestDegradedLeaderCheckIsSuspendedDuringSnapshots(t *testing.T) {
+	n := &node{
+		shardID:   1,
+		replicaID: 1,
+		sysEvents: newSysEventListener(nil, 0),
+		degraded: newDegradedLeaderDetector(config.Config{
+			ElectionRTT:             10,
+			DegradedLeaderThreshold: time.Millisecond,
+			DegradedLeaderRTT:       1,
+		}),
+	}
+	check := func() {
+		n.currentTick++
+		n.degraded.diskSaved(time.Second)
+		if err := n.checkDegradedLeader(); err != nil {
+			t.Fatalf("check failed %v", err)
+		}
+		if n.degraded.ticks != 0 || n.degraded.lastEvent != 0 {
+			t.Fatalf("degraded leader check not suspended")
+		}
+	}
+	// not the leader
+	check()
+	n.leaderInfo.Store(&leaderInfo{leaderID: 1, term: 2})
+	n.ss.setSaving()
+	check()
+	n.ss.clearSaving()
+	n.ss.setRecovering()
+	check()
+	n.ss.clearRecovering()
+	n.ss.setStreaming()
+	check()
+}
+
+// slowSyncFS delays Sync invocations on files in the specified directory.
+type slowSyncFS struct {
+	vfs.IFS
+	mu    sync.Mutex
+	dir   string
+	delay time.Duration
+}
+
+func (fs *slowSyncFS) Create(name string) (vfs.File, error) {
+	f, err := fs.IFS.Create(name)
+	if err != nil {
+		return f, err
+	}
+	return &slowSyncFile{File: f, fs: fs, name: name}, nil
+}
+
+func (fs *slowSyncFS) MaybeError(op vfs.Op) error {
+	return nil
+}
+
+func (fs *slowSyncFS) setSlowDir(dir string, delay time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.dir, fs.delay = dir, delay
+}
+
+func (fs *slowSyncFS) getDelay(name string) time.Duration {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if len(fs.dir) > 0 && strings.HasPrefix(name, fs.dir+"/") {
+		return fs.delay
+	}
+	return 0
+}
+
+type slowSyncFile struct {
+	vfs.File
+	fs   *slowSyncFS
+	name string
+}
+
+func (f *slowSyncFile) Sync() error {
+	if delay := f.fs.getDelay(f.name); delay > 0 {
+		time.Sleep(delay)
+	}
+	return f.File.Sync()
+}
+
+func TestDegradedLeaderHandsOffLeadership(t *testing.T) {
+	sfs := &slowSyncFS{IFS: vfs.GetTestFS()}
+	fs := vfs.Wrap(sfs, sfs)
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	func() {
+		defer leaktest.AfterTest(t)()
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+		network := memtransport.NewNetwork()
+		rtt := getRTTMillisecond(fs, singleNodeHostTestDir)
+		configs := network.NodeHostConfigs(3, singleNodeHostTestDir, rtt)
+		var nhs []*NodeHost
+		var listeners []*testSysEventListener
+		defer func() {
+			for _, nh := range nhs {
+				nh.Close()
+			}
+		}()
+		peers := make(map[uint64]string)
+		for i, nhc := range configs {
+			nhc.Expert = getTestExpertConfig(fs)
+			nhc.Expert.TransportFactory = network
+			l := &testSysEventListener{}
+			nhc.SystemEventListener = l
+			nh, err := NewNodeHost(nhc)
+			if err != nil {
+				t.Fatalf("failed to create nodehost %v", err)
+			}
+			nhs = append(nhs, nh)
+			listeners = append(listeners, l)
+			peers[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		tick := time.Duration(rtt) * time.Millisecond
+		for i, nh := range nhs {
+			rc := config.Config{
+				ShardID:                 1,
+				ReplicaID:               uint64(i + 1),
+				ElectionRTT:             20,
+				HeartbeatRTT:            1,
+				CheckQuorum:             true,
+				PreVote:                 true,
+				DegradedLeaderThreshold: 2 * tick,
+				DegradedLeaderRTT:       5,
+			}
+			createSM := func(uint64, uint64) sm.IStateMachine {
+				return &PST{}
+			}
+			if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+				t.Fatalf("failed to start replica %v", err)
+			}
+		}
+		for _, nh := range nhs {
+			waitForLeaderToBeElected(t, nh, 1)
+		}
+		getLeader := func() uint64 {
+			leaderID, _, ok, err := nhs[0].GetLeaderID(1)
+			if err != nil || !ok {
+				return 0
+			}
+			return leaderID
+		}
+		leaderID := getLeader()
+		if leaderID == 0 {
+			t.Fatalf("no leader")
+		}
+		degraded := nhs[leaderID-1]
+		stopper := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session := degraded.GetNoOPSession(1)
+			for {
+				select {
+				case <-stopper:
+					return
+				default:
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 20*tick)
+				_, _ = degraded.SyncPropose(ctx, session, make([]byte, 16))
+				cancel()
+			}
+		}()
+		defer func() {
+			close(stopper)
+			wg.Wait()
+		}()
+		// fsync on the leader takes 4 ticks, heartbeats are still sent in time
+		sfs.setSlowDir(degraded.NodeHostConfig().NodeHostDir, 4*tick)
+		start := time.Now()
+		newLeaderID := leaderID
+		for newLeaderID == leaderID || newLeaderID == 0 {
+			if time.Since(start) > 200*tick {
+				t.Fatalf("leadership not handed off")
+			}
+			time.Sleep(tick)
+			newLeaderID = getLeader()
+		}
+		// events are delivered asynchronously
+		var events []raftio.LeaderDegradedInfo
+		for i := 0; len(events) == 0; i++ {
+			if i > 100 {
+				t.Fatalf("no LeaderDegraded event")
+			}
+			time.Sleep(tick)
+			events = listeners[leaderID-1].getLeaderDegradedEvents()
+		}
+		e := events[0]
+		if e.Operation != degradedLogDB || e.Latency <= 2*tick ||
+			e.Target != newLeaderID || e.Ticks < 5 {
+			t.Errorf("unexpected event %+v", e)
+		}
+		// the leadership stays with the healthy replica
+		for i := 0; i < 40; i++ {
+			if v := getLeader(); v != 0 && v != newLeaderID {
+				t.Fatalf("leadership moved from %d to %d", newLeaderID, v)
+			}
+			time.Sleep(tick)
+		}
+		if n := len(listeners[leaderID-1].getLeaderDegradedEvents()); n != 1 {
+			t.Errorf("%d events published by the degraded replica", n)
+		}
+		for i, l := range listeners {
+			if uint64(i+1) != leaderID && len(l.getLeaderDegradedEvents()) != 0 {
+				t.Errorf("degraded event published by healthy replica %d", i+1)
+			}
+		}
+	}()
+	reportLeakedFD(fs, t)
+}
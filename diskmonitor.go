@@ -0,0 +1,239 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gvfs "github.com/lni/vfs"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+type diskSpaceLevel uint8
+
+const (
+	diskSpaceNormal diskSpaceLevel = iota
+	diskSpaceLow
+	diskSpaceCritical
+)
+
+// diskUsageFunc returns the disk usage of the file system containing the
+// specified path.
+type diskUsageFunc func(path string) (gvfs.DiskUsage, error)
+
+var diskSpaceEventTypes = [...]server.SystemEventType{
+	server.DiskSpaceRecovered,
+	server.DiskSpaceLow,
+	server.DiskSpaceCritical,
+}
+
+// diskMonitor periodically checks the free disk space of the NodeHostDir, the
+// WALDir and the data directories of on disk state machines. Replicas affected
+// by a critical level of free disk space reject new proposals.
+type diskMonitor struct {
+	mu struct {
+		sync.Mutex
+		dataDirs map[uint64]string
+		usage    diskUsageFunc
+	}
+	cfg      config.DiskMonitorConfig
+	events   *sysEventListener
+	dirs     []string
+	levels   map[string]diskSpaceLevel
+	failed   map[string]struct{}
+	hostFull uint32
+}
+
+func newDiskMonitor(nhConfig config.NodeHostConfig,
+	fs vfs.IFS, events *sysEventListener) *diskMonitor {
+	dirs := []string{nhConfig.NodeHostDir}
+	if len(nhConfig.WALDir) > 0 && nhConfig.WALDir != nhConfig.NodeHostDir {
+		dirs = append(dirs, nhConfig.WALDir)
+	}
+	m := &diskMonitor{
+		cfg:    nhConfig.DiskMonitor,
+		events: events,
+		dirs:   dirs,
+		levels: make(map[string]diskSpaceLevel),
+		failed: make(map[string]struct{}),
+	}
+	m.mu.dataDirs = make(map[uint64]string)
+	m.mu.usage = fs.GetDiskUsage
+	return m
+}
+
+func (m *diskMonitor) enabled() bool {
+	return !m.cfg.IsEmpty()
+}
+
+// setDataDir records the data directory of the on disk state machine of the
+// specified shard.
+func (m *diskMonitor) setDataDir(shardID uint64, dir string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mu.dataDirs[shardID] = dir
+}
+
+// setDiskUsageFunc sets the function used for getting disk usages.
+func (m *diskMonitor) setDiskUsageFunc(f diskUsageFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mu.usage = f
+}
+
+// hostDiskFull returns a boolean value indicating whether the NodeHostDir or
+// the WALDir has a critical level of free disk space.
+func (m *diskMonitor) hostDiskFull() bool {
+	return atomic.LoadUint32(&m.hostFull) == 1
+}
+
+func (m *diskMonitor) getLevel(avail uint64) diskSpaceLevel {
+	if avail < m.cfg.CriticalFreeBytes {
+		return diskSpaceCritical
+	}
+	if avail < m.cfg.WarningFreeBytes {
+		return diskSpaceLow
+	}
+	return diskSpaceNormal
+}
+
+// checkDir returns the free disk space level of the specified directory, a
+// system event is published when the level changed. The last known level is
+// returned when the disk usage is not available.
+func (m *diskMonitor) checkDir(usage diskUsageFunc,
+	dir string, shardID uint64) diskSpaceLevel {
+	du, err := usage(dir)
+	if err != nil {
+		if _, ok := m.failed[dir]; !ok {
+			plog.Warningf("failed to get disk usage of %s, %v", dir, err)
+			m.failed[dir] = struct{}{}
+		}
+		return m.levels[dir]
+	}
+	delete(m.failed, dir)
+	level := m.getLevel(du.AvailBytes)
+	if level != m.levels[dir] {
+		if level == diskSpaceNormal {
+			plog.Infof("free disk space of %s recovered, %d bytes available",
+				dir, du.AvailBytes)
+		} else {
+			plog.Warningf("low free disk space of %s, %d bytes available",
+				dir, du.AvailBytes)
+		}
+		m.levels[dir] = level
+		m.events.Publish(server.SystemEvent{
+			Type:       diskSpaceEventTypes[level],
+			Path:       dir,
+			ShardID:    shardID,
+			AvailBytes: du.AvailBytes,
+			TotalBytes: du.TotalBytes,
+		})
+	}
+	return level
+}
+
+// check checks the free disk space of all monitored directories and updates
+// the disk full state of the specified replicas.
+func (m *diskMonitor) check(nodes []*node) {
+	m.mu.Lock()
+	dataDirs := make(map[uint64]string, len(m.mu.dataDirs))
+	for shardID, dir := range m.mu.dataDirs {
+		dataDirs[shardID] = dir
+	}
+	usage := m.mu.usage
+	m.mu.Unlock()
+	hostFull := false
+	for _, dir := range m.dirs {
+		if m.checkDir(usage, dir, 0) == diskSpaceCritical {
+			hostFull = true
+		}
+	}
+	if hostFull {
+		atomic.StoreUint32(&m.hostFull, 1)
+	} else {
+		atomic.StoreUint32(&m.hostFull, 0)
+	}
+	running := make(map[uint64]struct{}, len(nodes))
+	for _, n := range nodes {
+		running[n.shardID] = struct{}{}
+		full := hostFull
+		if dir, ok := dataDirs[n.shardID]; ok {
+			if m.checkDir(usage, dir, n.shardID) == diskSpaceCritical {
+				full = true
+			}
+		}
+		if n.setDiskFull(full) {
+			plog.Warningf("%s disk full state is %t", n.id(), full)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for shardID, dir := range m.mu.dataDirs {
+		if _, ok := running[shardID]; !ok {
+			delete(m.mu.dataDirs, shardID)
+			if !m.isHostDir(dir) {
+				delete(m.levels, dir)
+				delete(m.failed, dir)
+			}
+		}
+	}
+}
+
+func (m *diskMonitor) isHostDir(dir string) bool {
+	for _, d := range m.dirs {
+		if d == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func (nh *NodeHost) diskMonitorMain() {
+	ticker := time.NewTicker(nh.nhConfig.DiskMonitor.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			var nodes []*node
+			nh.forEachShard(func(shardID uint64, n *node) bool {
+				nodes = append(nodes, n)
+				return true
+			})
+			nh.diskMonitor.check(nodes)
+		case <-nh.stopper.ShouldStop():
+			return
+		}
+	}
+}
+
+// setDiskFull sets the disk full state of the replica, it returns a boolean
+// value indicating whether the state changed. Proposals are rejected with
+// ErrDiskFull when the disk is full.
+func (n *node) setDiskFull(full bool) bool {
+	v := uint32(0)
+	if full {
+		v = 1
+	}
+	return atomic.SwapUint32(&n.diskFull, v) != v
+}
+
+func (n *node) isDiskFull() bool {
+	return atomic.LoadUint32(&n.diskFull) == 1
+}
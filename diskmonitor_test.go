@@ -0,0 +1,234 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	gvfs "github.com/lni/vfs"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/tests"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// fakeDiskUsage reports fake disk usages, 1000 bytes are available unless
+// specified otherwise.
+type fakeDiskUsage struct {
+	mu    sync.Mutex
+	avail map[string]uint64
+	fail  bool
+}
+
+func newFakeDiskUsage() *fakeDiskUsage {
+	return &fakeDiskUsage{avail: make(map[string]uint64)}
+}
+
+func (f *fakeDiskUsage) setAvail(path string, avail uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.avail[path] = avail
+}
+
+func (f *fakeDiskUsage) setFail(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = fail
+}
+
+func (f *fakeDiskUsage) GetDiskUsage(path string) (gvfs.DiskUsage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail {
+		return gvfs.DiskUsage{}, errors.New("failed to get disk usage")
+	}
+	avail, ok := f.avail[path]
+	if !ok {
+		avail = 1000
+	}
+	return gvfs.DiskUsage{AvailBytes: avail, TotalBytes: 1000}, nil
+}
+
+type dataDirDiskSM struct {
+	*tests.FakeDiskSM
+	dir string
+}
+
+func (s *dataDirDiskSM) DataDir() string {
+	return s.dir
+}
+
+func getDiskMonitorTestConfig() config.DiskMonitorConfig {
+	return config.DiskMonitorConfig{
+		Interval:          10 * time.Millisecond,
+		WarningFreeBytes:  200,
+		CriticalFreeBytes: 100,
+	}
+}
+
+func TestDiskMonitorTracksThresholdTransitions(t *testing.T) {
+	du := newFakeDiskUsage()
+	events := newSysEventListener(&testSysEventListener{}, 0)
+	nhc := config.NodeHostConfig{
+		NodeHostDir: "/nh",
+		WALDir:      "/wal",
+		DiskMonitor: getDiskMonitorTestConfig(),
+	}
+	m := newDiskMonitor(nhc, vfs.GetTestFS(), events)
+	m.setDiskUsageFunc(du.GetDiskUsage)
+	n1 := &node{shardID: 1, replicaID: 1}
+	n2 := &node{shardID: 2, replicaID: 1}
+	m.setDataDir(2, "/sm2")
+	tests := []struct {
+		path   string
+		avail  uint64
+		fail   bool
+		event  server.SystemEventType
+		events int
+		full1  bool
+		full2  bool
+	}{
+		{"/nh", 1000, false, 0, 0, false, false},
+		{"/wal", 150, false, server.DiskSpaceLow, 1, false, false},
+		{"/wal", 50, false, server.DiskSpaceCritical, 1, true, true},
+		{"/wal", 150, false, server.DiskSpaceLow, 1, false, false},
+		{"/wal", 1000, false, server.DiskSpaceRecovered, 1, false, false},
+		{"/sm2", 50, false, server.DiskSpaceCritical, 1, false, true},
+		// the last known level is kept when disk usage is not available
+		{"/sm2", 1000, true, 0, 0, false, true},
+		{"/sm2", 1000, false, server.DiskSpaceRecovered, 1, false, false},
+	}
+	for idx, tt := range tests {
+		du.setAvail(tt.path, tt.avail)
+		du.setFail(tt.fail)
+		m.check([]*node{n1, n2})
+		var published []server.SystemEvent
+		for {
+			e, ok := events.getEvent()
+			if !ok {
+				break
+			}
+			published = append(published, e)
+		}
+		if len(published) != tt.events {
+			t.Fatalf("%d, unexpected events %+v", idx, published)
+		}
+		if tt.events > 0 {
+			e := published[0]
+			if e.Type != tt.event || e.Path != tt.path || e.AvailBytes != tt.avail {
+				t.Errorf("%d, unexpected event %+v", idx, e)
+			}
+			if tt.path == "/sm2" && e.ShardID != 2 {
+				t.Errorf("%d, unexpected shard ID %d", idx, e.ShardID)
+			}
+		}
+		if n1.isDiskFull() != tt.full1 || n2.isDiskFull() != tt.full2 {
+			t.Errorf("%d, disk full %t/%t, want %t/%t", idx,
+				n1.isDiskFull(), n2.isDiskFull(), tt.full1, tt.full2)
+		}
+		if m.hostDiskFull() != (tt.path == "/wal" && tt.avail < 100) {
+			t.Errorf("%d, unexpected host disk full state", idx)
+		}
+	}
+	// data dirs of stopped shards are no longer monitored
+	m.check([]*node{n1})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.mu.dataDirs) != 0 {
+		t.Errorf("data dir not removed, %v", m.mu.dataDirs)
+	}
+}
+
+func TestProposalsAreRejectedWhenDiskIsFull(t *testing.T) {
+	fs := vfs.GetTestFS()
+	dfs := newFakeDiskUsage()
+	listener := &testSysEventListener{}
+	smDir := "/sm-data"
+	to := &testOption{
+		createOnDiskSM: func(uint64, uint64) sm.IOnDiskStateMachine {
+			return &dataDirDiskSM{FakeDiskSM: tests.NewFakeDiskSM(0), dir: smDir}
+		},
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.SystemEventListener = listener
+			c.DiskMonitor = getDiskMonitorTestConfig()
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			nh.diskMonitor.setDiskUsageFunc(dfs.GetDiskUsage)
+			session := nh.GetNoOPSession(1)
+			propose := func() error {
+				ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+				defer cancel()
+				_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
+				return err
+			}
+			waitForProposalResult := func(want error) {
+				var err error
+				for i := 0; i < 500; i++ {
+					if err = propose(); errors.Is(err, want) {
+						return
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				t.Fatalf("unexpected proposal result %v, want %v", err, want)
+			}
+			waitForEvents := func(f func() int, count int) {
+				for i := 0; i < 500 && f() < count; i++ {
+					time.Sleep(10 * time.Millisecond)
+				}
+				if f() < count {
+					t.Fatalf("system events not published")
+				}
+			}
+			for _, path := range []string{nh.nhConfig.NodeHostDir, smDir} {
+				dfs.setAvail(path, 50)
+				waitForProposalResult(ErrDiskFull)
+				// reads are still served
+				ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+				_, err := nh.SyncRead(ctx, 1, nil)
+				cancel()
+				if err != nil {
+					t.Fatalf("failed to read, %v", err)
+				}
+				dfs.setAvail(path, 1000)
+				waitForProposalResult(nil)
+			}
+			waitForEvents(func() int {
+				_, _, recovered := listener.getDiskSpaceEvents()
+				return len(recovered)
+			}, 2)
+			_, critical, recovered := listener.getDiskSpaceEvents()
+			if len(critical) != 2 ||
+				critical[0].Path != nh.nhConfig.NodeHostDir ||
+				critical[0].ShardID != 0 || critical[0].AvailBytes != 50 ||
+				critical[1].Path != smDir || critical[1].ShardID != 1 {
+				t.Errorf("unexpected DiskSpaceCritical events %+v", critical)
+			}
+			if len(recovered) != 2 || recovered[1].Path != smDir {
+				t.Errorf("unexpected DiskSpaceRecovered events %+v", recovered)
+			}
+			if critical[0].TotalBytes != 1000 {
+				t.Errorf("unexpected total bytes %d", critical[0].TotalBytes)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
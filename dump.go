@@ -0,0 +1,188 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+// RaftStateDump is a point-in-time view of the Raft state of a replica that
+// can be marshaled as JSON and attached to bug reports. All values are
+// collected by the Raft worker of the replica in one go.
+type RaftStateDump struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// Role is the Raft role of the replica, it is one of Follower, Candidate,
+	// PreVoteCandidate, Leader, NonVoting and Witness.
+	Role     string
+	Term     uint64
+	Vote     uint64
+	LeaderID uint64
+	// CommittedIndex, AppliedIndex, FirstIndex and LastIndex are the log indexes
+	// known to the Raft protocol implementation.
+	CommittedIndex uint64
+	AppliedIndex   uint64
+	FirstIndex     uint64
+	LastIndex      uint64
+	// InMemLogEntries and InMemLogBytes are the number and the size of log
+	// entries kept in memory.
+	InMemLogEntries uint64
+	InMemLogBytes   uint64
+	// InMemLogRetention is the size of log entries kept in memory grouped by
+	// the reason they are retained.
+	InMemLogRetention InMemLogRetention
+	// Peers is the replication progress of all other replicas, it is only
+	// available on the leader.
+	Peers []PeerProgress
+	// PendingProposals and PendingReads are the numbers of proposals and
+	// linearizable reads not completed yet.
+	PendingProposals uint64
+	PendingReads     uint64
+	// PendingReadIndexes is the number of ReadIndex requests waiting to be
+	// confirmed by the Raft protocol implementation.
+	PendingReadIndexes   uint64
+	PendingConfigChange  bool
+	LeaderTransferTarget uint64
+	Snapshot             SnapshotStateDump
+	QuiesceEnabled       bool
+	Quiesced             bool
+	Ticks                TickDump
+	// UnsafeRecovery describes the last forcible rewrite of the membership made
+	// by tools.UnsafeRecoverMembership, it is kept for the life of the replica.
+	UnsafeRecovery UnsafeRecoveryDump
+}
+
+// PeerProgress is the replication progress of a remote replica as tracked by
+// the leader.
+type PeerProgress struct {
+	ReplicaID uint64
+	// Type is one of Voting, NonVoting and Witness.
+	Type string
+	// State is one of Retry, Wait, Replicate and Snapshot.
+	State         string
+	Match         uint64
+	Next          uint64
+	SnapshotIndex uint64
+	// LastActive is the Raft tick when the last message was received from the
+	// remote replica.
+	LastActive uint64
+	Active     bool
+	// Throttled indicates whether the replication to the remote replica is
+	// being paced as it is catching up, see
+	// config.Config.MaxCatchupBytesPerSecond for details.
+	Throttled bool
+}
+
+// SnapshotStateDump contains the snapshot related state of a replica.
+type SnapshotStateDump struct {
+	// Index is the index of the most recent snapshot of the replica.
+	Index uint64
+	// Requested indicates whether there is a user requested snapshot not
+	// completed yet.
+	Requested  bool
+	Saving     bool
+	Recovering bool
+	Streaming  bool
+}
+
+// TickDump contains the tick counters of a replica.
+type TickDump struct {
+	// Tick is the number of ticks since the replica was started.
+	Tick uint64
+	// RaftTick is the tick counter of the Raft protocol implementation.
+	RaftTick        uint64
+	ElectionTick    uint64
+	HeartbeatTick   uint64
+	ElectionTimeout uint64
+}
+
+// UnsafeRecoveryDump describes the forcible rewrites of the membership of a
+// replica made by tools.UnsafeRecoverMembership.
+type UnsafeRecoveryDump struct {
+	// Count is the number of times the membership has been rewritten, 0 means
+	// the membership has never been rewritten.
+	Count uint64
+	// Index is the log index of the first config change entry written by the
+	// last rewrite.
+	Index uint64
+	// Time is the Unix time in seconds of the last rewrite.
+	Time int64
+}
+
+// getRaftStateDump returns the current Raft state, it is invoked by the step
+// worker with the raftMu held.
+func (n *node) getRaftStateDump() *RaftStateDump {
+	st := n.p.GetStatus()
+	d := &RaftStateDump{
+		ShardID:              n.shardID,
+		ReplicaID:            n.replicaID,
+		Role:                 st.State,
+		Term:                 st.Term,
+		Vote:                 st.Vote,
+		LeaderID:             st.LeaderID,
+		CommittedIndex:       st.Committed,
+		AppliedIndex:         st.Applied,
+		FirstIndex:           st.FirstIndex,
+		LastIndex:            st.LastIndex,
+		InMemLogEntries:      st.InMemEntries,
+		InMemLogBytes:        st.InMemBytes,
+		InMemLogRetention:    st.InMemRetention,
+		PendingProposals:     n.pendingProposals.count(),
+		PendingReads:         n.pendingReadIndexes.count(),
+		PendingReadIndexes:   st.PendingReadIndexes,
+		PendingConfigChange:  st.PendingConfigChange,
+		LeaderTransferTarget: st.LeaderTransferTarget,
+		Snapshot: SnapshotStateDump{
+			Index:      n.ss.getIndex(),
+			Requested:  n.pendingSnapshot.requested(),
+			Saving:     n.ss.saving(),
+			Recovering: n.ss.recovering(),
+			Streaming:  n.ss.streaming(),
+		},
+		QuiesceEnabled: n.qs.enabled,
+		Quiesced:       n.qs.quiesced(),
+		Ticks: TickDump{
+			Tick:            n.currentTick,
+			RaftTick:        st.TickCount,
+			ElectionTick:    st.ElectionTick,
+			HeartbeatTick:   st.HeartbeatTick,
+			ElectionTimeout: st.ElectionTimeout,
+		},
+		UnsafeRecovery: n.unsafeRecovery,
+	}
+	for _, r := range st.Remotes {
+		d.Peers = append(d.Peers, PeerProgress{
+			ReplicaID:     r.ReplicaID,
+			Type:          r.Type,
+			State:         r.State,
+			Match:         r.Match,
+			Next:          r.Next,
+			SnapshotIndex: r.SnapshotIndex,
+			LastActive:    r.LastActive,
+			Active:        r.Active,
+			Throttled:     r.Throttled,
+		})
+	}
+	return d
+}
+
+func (n *node) requestRaftStateDump() (chan *RaftStateDump, error) {
+	if !n.initialized() {
+		return nil, ErrShardNotReady
+	}
+	return n.pendingRaftStateDump.request()
+}
+
+func (n *node) handleRaftStateDump() {
+	if c, ok := n.pendingRaftStateDump.get(); ok {
+		c <- n.getRaftStateDump()
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+func mustDumpRaftState(t *testing.T, nh *NodeHost) *RaftStateDump {
+	d, err := nh.DumpRaftState(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("failed to dump raft state, %v", err)
+	}
+	return d
+}
+
+func TestRaftStateCanBeDumped(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		peers := map[uint64]string{1: nodeHostTestAddr1, 2: nodeHostTestAddr2}
+		rc := config.Config{
+			ShardID:      1,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+		}
+		var nhs []*NodeHost
+		for replicaID := uint64(1); replicaID <= 2; replicaID++ {
+			rc.ReplicaID = replicaID
+			nh := startTestReplica(t, fs, rc, peers[replicaID], peers, false, nil)
+			defer nh.Close()
+			nhs = append(nhs, nh)
+		}
+		waitForLeaderToBeElected(t, nhs[0], 1)
+		leaderID, term, ok, err := nhs[0].GetLeaderID(1)
+		if err != nil || !ok {
+			t.Fatalf("failed to get leader id, %v", err)
+		}
+		leader := nhs[leaderID-1]
+		follower := nhs[2-leaderID]
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := leader.SyncRequestAddWitness(ctx, 1, 3, nodeHostTestAddr3, 0); err != nil {
+			t.Fatalf("failed to add witness, %v", err)
+		}
+		rc.ReplicaID = 3
+		rc.IsWitness = true
+		witness := startTestReplica(t, fs, rc, nodeHostTestAddr3, nil, true, nil)
+		defer witness.Close()
+		makeProposals(leader)
+		var ld *RaftStateDump
+		for i := 0; i < 100; i++ {
+			ld = mustDumpRaftState(t, leader)
+			if len(ld.Peers) == 2 && ld.Peers[0].Match == ld.LastIndex {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if ld.Role != "Leader" || ld.LeaderID != leaderID || ld.ReplicaID != leaderID ||
+			ld.Term != term || ld.Vote != leaderID {
+			t.Errorf("unexpected leader dump %+v", ld)
+		}
+		if ld.CommittedIndex == 0 || ld.CommittedIndex > ld.LastIndex ||
+			ld.AppliedIndex > ld.CommittedIndex || ld.FirstIndex > ld.LastIndex {
+			t.Errorf("unexpected log indexes %+v", ld)
+		}
+		// applied entries are released from memory
+		if (ld.InMemLogEntries == 0) != (ld.InMemLogBytes == 0) {
+			t.Errorf("unexpected in memory log %+v", ld)
+		}
+		if len(ld.Peers) != 2 ||
+			ld.Peers[0].ReplicaID != 3-leaderID || ld.Peers[0].Type != "Voting" ||
+			ld.Peers[1].ReplicaID != 3 || ld.Peers[1].Type != "Witness" {
+			t.Fatalf("unexpected peers %+v", ld.Peers)
+		}
+		if ld.Peers[0].Match == 0 || ld.Peers[0].State != "Replicate" {
+			t.Errorf("unexpected peer progress %+v", ld.Peers[0])
+		}
+		if ld.PendingProposals != 0 || ld.PendingReads != 0 ||
+			ld.Snapshot.Saving || ld.Snapshot.Requested || ld.Ticks.Tick == 0 {
+			t.Errorf("unexpected leader dump %+v", ld)
+		}
+		fd := mustDumpRaftState(t, follower)
+		if fd.Role != "Follower" || fd.LeaderID != leaderID ||
+			fd.Term != term || len(fd.Peers) != 0 {
+			t.Errorf("unexpected follower dump %+v", fd)
+		}
+		wd := mustDumpRaftState(t, witness)
+		if wd.Role != "Witness" || wd.ReplicaID != 3 || len(wd.Peers) != 0 {
+			t.Errorf("unexpected witness dump %+v", wd)
+		}
+		data, err := json.Marshal(ld)
+		if err != nil {
+			t.Fatalf("failed to marshal, %v", err)
+		}
+		var unmarshaled RaftStateDump
+		if err := json.Unmarshal(data, &unmarshaled); err != nil {
+			t.Fatalf("failed to unmarshal, %v", err)
+		}
+		if unmarshaled.Role != ld.Role || len(unmarshaled.Peers) != 2 {
+			t.Errorf("unexpected unmarshaled dump %+v", unmarshaled)
+		}
+		nhi := follower.GetNodeHostInfo(NodeHostInfoOption{WithRaftState: true})
+		if len(nhi.RaftStateList) != 1 ||
+			nhi.RaftStateList[0].ShardID != 1 || nhi.RaftStateList[0].Role != "Follower" {
+			t.Errorf("unexpected raft state list %+v", nhi.RaftStateList)
+		}
+		nhi = follower.GetNodeHostInfo(DefaultNodeHostInfoOption)
+		if len(nhi.RaftStateList) != 0 {
+			t.Errorf("raft state unexpectedly included")
+		}
+		if _, err := follower.DumpRaftState(context.Background(), 2); err != ErrShardNotFound {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
@@ -17,17 +17,18 @@ package dragonboat
 import (
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lni/goutils/syncutil"
 
 	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/failpoint"
 	"github.com/lni/dragonboat/v4/internal/rsm"
 	"github.com/lni/dragonboat/v4/internal/server"
 	"github.com/lni/dragonboat/v4/internal/settings"
 	"github.com/lni/dragonboat/v4/raftio"
 	pb "github.com/lni/dragonboat/v4/raftpb"
-	sm "github.com/lni/dragonboat/v4/statemachine"
 )
 
 var (
@@ -70,6 +71,7 @@ type nodeLoader interface {
 	describe() string
 	getShardSetIndex() uint64
 	forEachShard(f func(uint64, *node) bool) uint64
+	flushEvents()
 }
 
 type nodeType struct {
@@ -129,6 +131,7 @@ type workReady struct {
 	partitioner server.IPartitioner
 	maps        []*readyShard
 	channels    []chan struct{}
+	pending     []uint32
 	count       uint64
 }
 
@@ -138,6 +141,7 @@ func newWorkReady(count uint64) *workReady {
 		count:       count,
 		maps:        make([]*readyShard, count),
 		channels:    make([]chan struct{}, count),
+		pending:     make([]uint32, count),
 	}
 	for i := uint64(0); i < count; i++ {
 		wr.channels[i] = make(chan struct{}, 1)
@@ -146,6 +150,30 @@ func newWorkReady(count uint64) *workReady {
 	return wr
 }
 
+// newApplyWorkReady returns the workReady instance of apply workers, shards are
+// assigned to apply workers using the WorkerAffinity function when it is set.
+func newApplyWorkReady(cfg config.EngineConfig) *workReady {
+	wr := newWorkReady(cfg.ApplyShards)
+	if cfg.WorkerAffinity != nil {
+		wr.partitioner = &affinityPartitioner{
+			affinity: cfg.WorkerAffinity,
+			count:    cfg.ApplyShards,
+		}
+	}
+	return wr
+}
+
+// affinityPartitioner is a server.IPartitioner assigning shards to workers
+// using the config.EngineConfig.WorkerAffinity function.
+type affinityPartitioner struct {
+	affinity func(shardID uint64) uint64
+	count    uint64
+}
+
+func (p *affinityPartitioner) GetPartitionID(shardID uint64) uint64 {
+	return p.affinity(shardID) % p.count
+}
+
 func (wr *workReady) getPartitioner() server.IPartitioner {
 	return wr.partitioner
 }
@@ -216,10 +244,35 @@ func (wr *workReady) shardReady(shardID uint64) {
 	wr.notify(idx)
 }
 
+// shardReadyDeferred marks the specified shard as ready without waking up its
+// worker, the worker is notified on the next flush call. This allows updates
+// from multiple shards to be coalesced into a single wakeup of each worker.
+func (wr *workReady) shardReadyDeferred(shardID uint64) {
+	idx := wr.partitioner.GetPartitionID(shardID)
+	readyMap := wr.maps[idx]
+	readyMap.setShardReady(shardID)
+	atomic.StoreUint32(&wr.pending[idx], 1)
+}
+
+// flush notifies all workers with shards marked as ready by
+// shardReadyDeferred.
+func (wr *workReady) flush() {
+	for idx := range wr.pending {
+		if atomic.LoadUint32(&wr.pending[idx]) != 0 &&
+			atomic.SwapUint32(&wr.pending[idx], 0) != 0 {
+			wr.notify(uint64(idx))
+		}
+	}
+}
+
 func (wr *workReady) waitCh(workerID uint64) chan struct{} {
 	return wr.channels[workerID-1]
 }
 
+func (wr *workReady) readyCount(workerID uint64) uint64 {
+	return wr.maps[workerID-1].count()
+}
+
 func (wr *workReady) getReadyMap(workerID uint64) map[uint64]struct{} {
 	readyMap := wr.maps[workerID-1]
 	return readyMap.getReadyShards()
@@ -235,25 +288,34 @@ type job struct {
 
 type ssWorker struct {
 	stopper    *syncutil.Stopper
+	stats      *workerStats
 	requestC   chan job
 	completedC chan struct{}
 	workerID   uint64
 }
 
-func newSSWorker(workerID uint64, stopper *syncutil.Stopper) *ssWorker {
+func newSSWorker(workerID uint64, stopper *syncutil.Stopper,
+	profilerLabels bool, stats *workerStats) *ssWorker {
 	w := &ssWorker{
 		workerID:   workerID,
 		stopper:    stopper,
+		stats:      stats,
 		requestC:   make(chan job, 1),
 		completedC: make(chan struct{}, 1),
 	}
+	if stats != nil {
+		stats.queue = func() uint64 { return uint64(len(w.requestC)) }
+	}
 	stopper.RunWorker(func() {
-		w.workerMain()
+		w.workerMain(profilerLabels)
 	})
 	return w
 }
 
-func (w *ssWorker) workerMain() {
+func (w *ssWorker) workerMain(profilerLabels bool) {
+	labels := newWorkerLabels(profilerLabels, snapshotWorkerRole, w.workerID)
+	pc := newPanicContext(snapshotWorkerRole, w.workerID)
+	defer pc.annotate()
 	for {
 		select {
 		case <-w.stopper.ShouldStop():
@@ -262,9 +324,14 @@ func (w *ssWorker) workerMain() {
 			if job.node == nil {
 				panic("req.node == nil")
 			}
-			if err := w.handle(job); err != nil {
+			w.stats.begin()
+			pc.set(getSnapshotOp(job.task), job.node)
+			var err error
+			labels.do(job.node, func() { err = w.handle(job) })
+			if err != nil {
 				panicNow(err)
 			}
+			w.stats.end(1)
 			w.completed()
 		}
 	}
@@ -311,8 +378,16 @@ func (w *ssWorker) stream(j job) error {
 	return nil
 }
 
+// ssLimits is the max numbers of concurrent snapshot saves and recoveries,
+// 0 means unlimited.
+type ssLimits struct {
+	saving     uint64
+	recovering uint64
+}
+
 type workerPool struct {
 	nh            nodeLoader
+	limits        ssLimits
 	saving        map[uint64]struct{}
 	cciReady      *workReady
 	saveReady     *workReady
@@ -330,10 +405,11 @@ type workerPool struct {
 	cci           uint64
 }
 
-func newWorkerPool(nh nodeLoader,
-	snapshotWorkerCount uint64, loaded *loadedNodes) *workerPool {
+func newWorkerPool(nh nodeLoader, snapshotWorkerCount uint64, limits ssLimits,
+	loaded *loadedNodes, profilerLabels bool, stats []*workerStats) *workerPool {
 	w := &workerPool{
 		nh:            nh,
+		limits:        limits,
 		loaded:        loaded,
 		cciReady:      newWorkReady(1),
 		saveReady:     newWorkReady(1),
@@ -350,9 +426,11 @@ func newWorkerPool(nh nodeLoader,
 		poolStopper:   syncutil.NewStopper(),
 	}
 	for workerID := uint64(0); workerID < snapshotWorkerCount; workerID++ {
-		w.workers[workerID] = newSSWorker(workerID, w.workerStopper)
+		w.workers[workerID] = newSSWorker(workerID,
+			w.workerStopper, profilerLabels, stats[workerID])
 	}
 	w.poolStopper.RunWorker(func() {
+		newWorkerLabels(profilerLabels, snapshotPoolRole, 0)
 		w.workerPoolMain()
 	})
 	return w
@@ -562,10 +640,17 @@ func (p *workerPool) canStream(shardID uint64) bool {
 }
 
 func (p *workerPool) canSave(shardID uint64) bool {
+	if p.limits.saving > 0 && uint64(len(p.saving)) >= p.limits.saving {
+		return false
+	}
 	return !p.inProgress(shardID)
 }
 
 func (p *workerPool) canRecover(shardID uint64) bool {
+	if p.limits.recovering > 0 &&
+		uint64(len(p.recovering)) >= p.limits.recovering {
+		return false
+	}
 	return !p.inProgress(shardID)
 }
 
@@ -625,6 +710,7 @@ func (p *workerPool) startRecovering(n *node) {
 
 func (p *workerPool) start(j job, n *node, workerID uint64) {
 	p.setBusy(n, workerID)
+	n.setSnapshotQueuePosition(0)
 	if j.task.Recover {
 		p.startRecovering(n)
 	} else if j.task.Save {
@@ -639,9 +725,23 @@ func (p *workerPool) start(j job, n *node, workerID uint64) {
 func (p *workerPool) schedule() {
 	for {
 		if !p.scheduleWorker() {
-			return
+			break
 		}
 	}
+	p.updateQueuePositions()
+}
+
+// jobRank returns the scheduling rank of the job, jobs with lower ranks are
+// scheduled first. Recoveries are required for replicas to make progress so
+// they never wait behind saves, prioritized saves are scheduled ahead of other
+// saves. Jobs with the same rank are scheduled in the order they were added.
+func jobRank(j job) int {
+	if j.task.Recover {
+		return 0
+	} else if j.task.Save && j.task.SSRequest.Prioritized {
+		return 1
+	}
+	return 2
 }
 
 func (p *workerPool) scheduleWorker() bool {
@@ -654,18 +754,56 @@ func (p *workerPool) scheduleWorker() bool {
 		return false
 	}
 	for idx, j := range p.pending {
-		n, ok := p.nodes[j.shardID]
-		if !ok {
+		if _, ok := p.nodes[j.shardID]; !ok {
 			p.removeFromPending(idx)
 			return true
 		}
-		if p.canSchedule(j) {
-			p.scheduleTask(j, n, w)
-			p.removeFromPending(idx)
-			return true
+	}
+	idx, ok := p.nextJob()
+	if !ok {
+		return false
+	}
+	j := p.pending[idx]
+	p.scheduleTask(j, p.nodes[j.shardID], w)
+	p.removeFromPending(idx)
+	return true
+}
+
+// nextJob returns the index of the pending job that should be scheduled next.
+func (p *workerPool) nextJob() (int, bool) {
+	selected := -1
+	for idx, j := range p.pending {
+		if p.canSchedule(j) &&
+			(selected < 0 || jobRank(j) < jobRank(p.pending[selected])) {
+			selected = idx
+		}
+	}
+	return selected, selected >= 0
+}
+
+// updateQueuePositions updates the positions of replicas waiting to save or
+// recover snapshots. Positions are 1-based and counted separately for saves
+// and recoveries in their scheduling order.
+func (p *workerPool) updateQueuePositions() {
+	prioritized := uint64(0)
+	for _, j := range p.pending {
+		if j.task.Save && j.task.SSRequest.Prioritized {
+			prioritized++
+		}
+	}
+	var saving, recovering, ahead uint64
+	for _, j := range p.pending {
+		if j.task.Recover {
+			recovering++
+			j.node.setSnapshotQueuePosition(recovering)
+		} else if j.task.Save && j.task.SSRequest.Prioritized {
+			ahead++
+			j.node.setSnapshotQueuePosition(ahead)
+		} else if j.task.Save {
+			saving++
+			j.node.setSnapshotQueuePosition(prioritized + saving)
 		}
 	}
-	return false
 }
 
 func (p *workerPool) removeFromPending(idx int) {
@@ -739,37 +877,57 @@ func (p *workerPool) scheduleTask(j job, n *node, w *ssWorker) {
 
 type closeReq struct {
 	node *node
+	// done is invoked once the node is destroyed, it is only set when the
+	// worker pool is shared by multiple NodeHost instances
+	done func()
 }
 
 type closeWorker struct {
 	stopper    *syncutil.Stopper
+	stats      *workerStats
 	requestC   chan closeReq
 	completedC chan struct{}
 	workerID   uint64
 }
 
-func newCloseWorker(workerID uint64, stopper *syncutil.Stopper) *closeWorker {
+func newCloseWorker(workerID uint64, stopper *syncutil.Stopper,
+	profilerLabels bool, stats *workerStats) *closeWorker {
 	w := &closeWorker{
 		workerID:   workerID,
 		stopper:    stopper,
+		stats:      stats,
 		requestC:   make(chan closeReq, 1),
 		completedC: make(chan struct{}, 1),
 	}
+	if stats != nil {
+		stats.queue = func() uint64 { return uint64(len(w.requestC)) }
+	}
 	stopper.RunWorker(func() {
-		w.workerMain()
+		w.workerMain(profilerLabels)
 	})
 	return w
 }
 
-func (w *closeWorker) workerMain() {
+func (w *closeWorker) workerMain(profilerLabels bool) {
+	labels := newWorkerLabels(profilerLabels, closeWorkerRole, w.workerID)
+	pc := newPanicContext(closeWorkerRole, w.workerID)
+	defer pc.annotate()
 	for {
 		select {
 		case <-w.stopper.ShouldStop():
 			return
 		case req := <-w.requestC:
-			if err := w.handle(req); err != nil {
+			w.stats.begin()
+			pc.set(destroyOp, req.node)
+			var err error
+			labels.do(req.node, func() { err = w.handle(req) })
+			if err != nil {
 				panicNow(err)
 			}
+			if req.done != nil {
+				req.done()
+			}
+			w.stats.end(1)
 			w.completed()
 		}
 	}
@@ -793,24 +951,29 @@ type closeWorkerPool struct {
 	workerStopper *syncutil.Stopper
 	poolStopper   *syncutil.Stopper
 	workers       []*closeWorker
-	pending       []*node
+	pending       []closeReq
+	stats         []*workerStats
 }
 
-func newCloseWorkerPool(closeWorkerCount uint64) *closeWorkerPool {
+func newCloseWorkerPool(closeWorkerCount uint64,
+	profilerLabels bool, stats []*workerStats) *closeWorkerPool {
 	w := &closeWorkerPool{
 		workers:       make([]*closeWorker, closeWorkerCount),
 		ready:         make(chan closeReq, 1),
 		busy:          make(map[uint64]uint64, closeWorkerCount),
 		processing:    make(map[uint64]struct{}, closeWorkerCount),
-		pending:       make([]*node, 0),
+		pending:       make([]closeReq, 0),
+		stats:         stats,
 		workerStopper: syncutil.NewStopper(),
 		poolStopper:   syncutil.NewStopper(),
 	}
 
 	for workerID := uint64(0); workerID < closeWorkerCount; workerID++ {
-		w.workers[workerID] = newCloseWorker(workerID, w.workerStopper)
+		w.workers[workerID] = newCloseWorker(workerID,
+			w.workerStopper, profilerLabels, stats[workerID])
 	}
 	w.poolStopper.RunWorker(func() {
+		newWorkerLabels(profilerLabels, closePoolRole, 0)
 		w.workerPoolMain()
 	})
 	return w
@@ -845,8 +1008,7 @@ func (p *closeWorkerPool) workerPoolMain() {
 			p.timedWait()
 			return
 		} else if chosen == 1 {
-			node := v.Interface().(closeReq).node
-			p.pending = append(p.pending, node)
+			p.pending = append(p.pending, v.Interface().(closeReq))
 		} else if chosen > 1 && chosen < len(p.workers)+2 {
 			workerID := uint64(chosen - 2)
 			p.completed(workerID)
@@ -871,7 +1033,7 @@ func (p *closeWorkerPool) timedWait() {
 	// p.ready is buffered, don't ignore that buffered close req
 	select {
 	case v := <-p.ready:
-		p.pending = append(p.pending, v.node)
+		p.pending = append(p.pending, v)
 	default:
 	}
 	p.schedule()
@@ -957,23 +1119,23 @@ func (p *closeWorkerPool) scheduleWorker() bool {
 	}
 
 	for i := 0; i < len(p.pending); i++ {
-		node := p.pending[0]
+		req := p.pending[0]
 		p.removeFromPending(0)
-		if p.canSchedule(node) {
-			p.scheduleReq(node, w)
+		if p.canSchedule(req.node) {
+			p.scheduleReq(req, w)
 			return true
 		} else {
-			p.pending = append(p.pending, node)
+			p.pending = append(p.pending, req)
 		}
 	}
 
 	return false
 }
 
-func (p *closeWorkerPool) scheduleReq(n *node, w *closeWorker) {
-	p.setBusy(w.workerID, n.shardID)
+func (p *closeWorkerPool) scheduleReq(req closeReq, w *closeWorker) {
+	p.setBusy(w.workerID, req.node.shardID)
 	select {
-	case w.requestC <- closeReq{node: n}:
+	case w.requestC <- req:
 	default:
 		panic("worker received multiple jobs")
 	}
@@ -1001,20 +1163,38 @@ type engine struct {
 	applyCCIReady   *workReady
 	wp              *workerPool
 	cp              *closeWorkerPool
+	closing         sync.WaitGroup
+	sharedClose     bool
 	ec              chan error
+	metrics         *nodeHostMetrics
+	stats           *engineStats
 	notifyCommit    bool
+	profilerLabels  bool
 }
 
-func newExecEngine(nh nodeLoader, cfg config.EngineConfig, notifyCommit bool,
-	errorInjection bool, env *server.Env, logdb raftio.ILogDB) *engine {
+// newExecEngine creates the execution engine. The close worker pool is shared
+// with other NodeHost instances when cp is not nil, a dedicated one is created
+// otherwise.
+func newExecEngine(nh nodeLoader, expert config.ExpertConfig, notifyCommit bool,
+	errorInjection bool, env *server.Env, logdb raftio.ILogDB,
+	metrics *nodeHostMetrics, profilerLabels bool, cp *closeWorkerPool) *engine {
+	cfg := expert.Engine
 	if cfg.ExecShards == 0 {
 		panic("ExecShards == 0")
 	}
 	loaded := newLoadedNodes()
+	stats := newEngineStats(cfg, notifyCommit)
+	sharedClose := cp != nil
+	if sharedClose {
+		stats.close = cp.stats
+	} else {
+		cp = newCloseWorkerPool(cfg.CloseShards, profilerLabels, stats.close)
+	}
 	s := &engine{
 		nh:              nh,
 		env:             env,
 		logdb:           logdb,
+		metrics:         metrics,
 		loaded:          loaded,
 		nodeStopper:     syncutil.NewStopper(),
 		commitStopper:   syncutil.NewStopper(),
@@ -1023,26 +1203,30 @@ func newExecEngine(nh nodeLoader, cfg config.EngineConfig, notifyCommit bool,
 		stepCCIReady:    newWorkReady(cfg.ExecShards),
 		commitWorkReady: newWorkReady(cfg.CommitShards),
 		commitCCIReady:  newWorkReady(cfg.CommitShards),
-		applyWorkReady:  newWorkReady(cfg.ApplyShards),
-		applyCCIReady:   newWorkReady(cfg.ApplyShards),
-		wp:              newWorkerPool(nh, cfg.SnapshotShards, loaded),
-		cp:              newCloseWorkerPool(cfg.CloseShards),
-		notifyCommit:    notifyCommit,
+		applyWorkReady:  newApplyWorkReady(cfg),
+		applyCCIReady:   newApplyWorkReady(cfg),
+		wp: newWorkerPool(nh, cfg.SnapshotShards, ssLimits{
+			saving:     expert.MaxConcurrentSnapshots,
+			recovering: expert.MaxConcurrentSnapshotRecoveries,
+		}, loaded, profilerLabels, stats.snapshot),
+		cp:             cp,
+		sharedClose:    sharedClose,
+		stats:          stats,
+		notifyCommit:   notifyCommit,
+		profilerLabels: profilerLabels,
 	}
 	if errorInjection {
 		s.ec = make(chan error, 1)
 	}
+	setReadyQueues(stats.step, s.stepWorkReady)
+	setReadyQueues(stats.commit, s.commitWorkReady)
+	setReadyQueues(stats.apply, s.applyWorkReady)
+	metrics.engineStarted(stats)
 	for i := uint64(1); i <= cfg.ExecShards; i++ {
 		workerID := i
 		s.nodeStopper.RunWorker(func() {
 			if errorInjection {
-				defer func() {
-					if r := recover(); r != nil {
-						if ce, ok := r.(error); ok {
-							s.crash(ce)
-						}
-					}
-				}()
+				defer s.recoverCrash()
 			}
 			s.stepWorkerMain(workerID)
 		})
@@ -1058,12 +1242,25 @@ func newExecEngine(nh nodeLoader, cfg config.EngineConfig, notifyCommit bool,
 	for i := uint64(1); i <= cfg.ApplyShards; i++ {
 		applyWorkerID := i
 		s.taskStopper.RunWorker(func() {
+			if errorInjection {
+				defer s.recoverCrash()
+			}
 			s.applyWorkerMain(applyWorkerID)
 		})
 	}
 	return s
 }
 
+// recoverCrash recovers the panic of the worker goroutine in the error
+// injection mode, the panic is reported as a crash instead.
+func (e *engine) recoverCrash() {
+	if r := recover(); r != nil {
+		if ce, ok := r.(error); ok {
+			e.crash(ce)
+		}
+	}
+}
+
 func (e *engine) crash(err error) {
 	select {
 	case e.ec <- err:
@@ -1075,11 +1272,33 @@ func (e *engine) close() error {
 	e.nodeStopper.Stop()
 	e.commitStopper.Stop()
 	e.taskStopper.Stop()
+	e.metrics.engineClosed()
 	var err error
 	err = firstError(err, e.wp.close())
+	if e.sharedClose {
+		e.waitForClosedNodes()
+		return err
+	}
 	return firstError(err, e.cp.close())
 }
 
+// waitForClosedNodes waits for nodes submitted to the shared close worker pool
+// to be destroyed, the shared pool itself is owned by the resource group.
+func (e *engine) waitForClosedNodes() {
+	done := make(chan struct{})
+	go func() {
+		e.closing.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timedCloseWait)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		plog.Infof("timed out waiting for nodes to be destroyed")
+	}
+}
+
 func (e *engine) nodeLoaded(shardID uint64, replicaID uint64) bool {
 	return e.loaded.get(shardID, replicaID) != nil
 }
@@ -1104,6 +1323,10 @@ func (e *engine) load(workerID uint64,
 }
 
 func (e *engine) commitWorkerMain(workerID uint64) {
+	labels := newWorkerLabels(e.profilerLabels, commitWorkerRole, workerID)
+	pc := newPanicContext(commitWorkerRole, workerID)
+	defer pc.annotate()
+	stats := e.stats.commit[workerID-1]
 	nodes := make(map[uint64]*node)
 	ticker := time.NewTicker(nodeReloadInterval)
 	defer ticker.Stop()
@@ -1114,16 +1337,23 @@ func (e *engine) commitWorkerMain(workerID uint64) {
 			e.offloadNodeMap(nodes)
 			return
 		case <-ticker.C:
+			stats.begin()
 			nodes, cci = e.loadCommitNodes(workerID, cci, nodes)
-			e.processCommits(make(map[uint64]struct{}), nodes)
+			a := make(map[uint64]struct{})
+			e.processCommits(a, nodes, labels, pc)
+			stats.end(len(a))
 		case <-e.commitCCIReady.waitCh(workerID):
+			stats.begin()
 			nodes, cci = e.loadCommitNodes(workerID, cci, nodes)
+			stats.end(0)
 		case <-e.commitWorkReady.waitCh(workerID):
+			stats.begin()
 			if cci == 0 || len(nodes) == 0 {
 				nodes, cci = e.loadCommitNodes(workerID, cci, nodes)
 			}
 			active := e.commitWorkReady.getReadyMap(workerID)
-			e.processCommits(active, nodes)
+			e.processCommits(active, nodes, labels, pc)
+			stats.end(len(active))
 		}
 	}
 }
@@ -1134,7 +1364,7 @@ func (e *engine) loadCommitNodes(workerID uint64, cci uint64,
 }
 
 func (e *engine) processCommits(idmap map[uint64]struct{},
-	nodes map[uint64]*node) {
+	nodes map[uint64]*node, labels workerLabels, pc *panicContext) {
 	if len(idmap) == 0 {
 		for k := range nodes {
 			idmap[k] = struct{}{}
@@ -1145,16 +1375,20 @@ func (e *engine) processCommits(idmap map[uint64]struct{},
 		if !ok || node.stopped() {
 			continue
 		}
-		node.notifyCommittedEntries()
+		pc.set(notifyCommitOp, node)
+		labels.do(node, node.notifyCommittedEntries)
 	}
 }
 
 func (e *engine) applyWorkerMain(workerID uint64) {
+	labels := newWorkerLabels(e.profilerLabels, applyWorkerRole, workerID)
+	pc := newPanicContext(applyWorkerRole, workerID)
+	defer pc.annotate()
+	stats := e.stats.apply[workerID-1]
 	nodes := make(map[uint64]*node)
 	ticker := time.NewTicker(nodeReloadInterval)
 	defer ticker.Stop()
 	batch := make([]rsm.Task, 0, taskBatchSize)
-	entries := make([]sm.Entry, 0, taskBatchSize)
 	cci := uint64(0)
 	count := uint64(0)
 	for {
@@ -1163,26 +1397,31 @@ func (e *engine) applyWorkerMain(workerID uint64) {
 			e.offloadNodeMap(nodes)
 			return
 		case <-ticker.C:
+			stats.begin()
 			nodes, cci = e.loadApplyNodes(workerID, cci, nodes)
 			a := make(map[uint64]struct{})
-			if err := e.processApplies(a, nodes, batch, entries); err != nil {
+			if err := e.processApplies(a, nodes, batch, labels, pc); err != nil {
 				panicNow(err)
 			}
+			stats.end(len(a))
 			count++
 			if count%200 == 0 {
 				batch = make([]rsm.Task, 0, taskBatchSize)
-				entries = make([]sm.Entry, 0, taskBatchSize)
 			}
 		case <-e.applyCCIReady.waitCh(workerID):
+			stats.begin()
 			nodes, cci = e.loadApplyNodes(workerID, cci, nodes)
+			stats.end(0)
 		case <-e.applyWorkReady.waitCh(workerID):
+			stats.begin()
 			if cci == 0 || len(nodes) == 0 {
 				nodes, cci = e.loadApplyNodes(workerID, cci, nodes)
 			}
 			a := e.applyWorkReady.getReadyMap(workerID)
-			if err := e.processApplies(a, nodes, batch, entries); err != nil {
+			if err := e.processApplies(a, nodes, batch, labels, pc); err != nil {
 				panicNow(err)
 			}
+			stats.end(len(a))
 		}
 	}
 }
@@ -1201,7 +1440,8 @@ func (e *engine) loadApplyNodes(workerID uint64, cci uint64,
 // R, S, won't happen, when in R state, processApplies will not process the node
 
 func (e *engine) processApplies(idmap map[uint64]struct{},
-	nodes map[uint64]*node, batch []rsm.Task, entries []sm.Entry) error {
+	nodes map[uint64]*node, batch []rsm.Task, labels workerLabels,
+	pc *panicContext) error {
 	if len(idmap) == 0 {
 		for k := range nodes {
 			idmap[k] = struct{}{}
@@ -1212,21 +1452,39 @@ func (e *engine) processApplies(idmap map[uint64]struct{},
 		if !ok || node.stopped() {
 			continue
 		}
-		if node.processStatusTransition() {
-			continue
-		}
-		task, err := node.handleTask(batch, entries)
+		var err error
+		pc.set(applyOp, node)
+		labels.do(node, func() { err = e.processApply(node, batch) })
 		if err != nil {
 			return err
 		}
-		if task.IsSnapshotTask() {
-			node.handleSnapshotTask(task)
-		}
+	}
+	// step workers and the event dispatcher are woken up once for all shards
+	// processed in this iteration
+	e.stepWorkReady.flush()
+	e.nh.flushEvents()
+	return nil
+}
+
+func (e *engine) processApply(node *node, batch []rsm.Task) error {
+	if node.processStatusTransition() {
+		return nil
+	}
+	task, err := node.handleTask(batch)
+	if err != nil {
+		return err
+	}
+	if task.IsSnapshotTask() {
+		node.handleSnapshotTask(task)
 	}
 	return nil
 }
 
 func (e *engine) stepWorkerMain(workerID uint64) {
+	labels := newWorkerLabels(e.profilerLabels, stepWorkerRole, workerID)
+	pc := newPanicContext(stepWorkerRole, workerID)
+	defer pc.annotate()
+	stats := e.stats.step[workerID-1]
 	nodes := make(map[uint64]*node)
 	ticker := time.NewTicker(nodeReloadInterval)
 	defer ticker.Stop()
@@ -1239,21 +1497,27 @@ func (e *engine) stepWorkerMain(workerID uint64) {
 			e.offloadNodeMap(nodes)
 			return
 		case <-ticker.C:
+			stats.begin()
 			nodes, cci = e.loadStepNodes(workerID, cci, nodes)
 			a := make(map[uint64]struct{})
-			if err := e.processSteps(workerID, a, nodes, updates, stopC); err != nil {
+			if err := e.processSteps(workerID, a, nodes, &updates, stopC, labels, pc); err != nil {
 				panicNow(err)
 			}
+			stats.end(len(a))
 		case <-e.stepCCIReady.waitCh(workerID):
+			stats.begin()
 			nodes, cci = e.loadStepNodes(workerID, cci, nodes)
+			stats.end(0)
 		case <-e.stepWorkReady.waitCh(workerID):
+			stats.begin()
 			if cci == 0 || len(nodes) == 0 {
 				nodes, cci = e.loadStepNodes(workerID, cci, nodes)
 			}
 			a := e.stepWorkReady.getReadyMap(workerID)
-			if err := e.processSteps(workerID, a, nodes, updates, stopC); err != nil {
+			if err := e.processSteps(workerID, a, nodes, &updates, stopC, labels, pc); err != nil {
 				panicNow(err)
 			}
+			stats.end(len(a))
 		}
 	}
 }
@@ -1302,7 +1566,8 @@ func (e *engine) loadBucketNodes(workerID uint64,
 
 func (e *engine) processSteps(workerID uint64,
 	active map[uint64]struct{},
-	nodes map[uint64]*node, nodeUpdates []pb.Update, stopC chan struct{}) error {
+	nodes map[uint64]*node, updates *[]pb.Update, stopC chan struct{},
+	labels workerLabels, pc *panicContext) error {
 	if len(nodes) == 0 {
 		return nil
 	}
@@ -1311,13 +1576,20 @@ func (e *engine) processSteps(workerID uint64,
 			active[cid] = struct{}{}
 		}
 	}
-	nodeUpdates = nodeUpdates[:0]
+	// the update slice is owned by the step worker and reused across
+	// iterations
+	nodeUpdates := (*updates)[:0]
+	defer func() { *updates = nodeUpdates }()
 	for cid := range active {
 		node, ok := nodes[cid]
 		if !ok || node.stopped() {
 			continue
 		}
-		ud, hasUpdate, err := node.stepNode()
+		var ud pb.Update
+		var hasUpdate bool
+		var err error
+		pc.set(stepNodeOp, node)
+		labels.do(node, func() { ud, hasUpdate, err = node.stepNode() })
 		if err != nil {
 			return err
 		}
@@ -1325,6 +1597,7 @@ func (e *engine) processSteps(workerID uint64,
 			nodeUpdates = append(nodeUpdates, ud)
 		}
 	}
+	pc.setShared(processRaftUpdateOp)
 	if err := e.applySnapshotAndUpdate(nodeUpdates, nodes, true); err != nil {
 		return err
 	}
@@ -1332,16 +1605,43 @@ func (e *engine) processSteps(workerID uint64,
 	// before those entries are persisted to disk
 	for _, ud := range nodeUpdates {
 		node := nodes[ud.ShardID]
-		node.sendReplicateMessages(ud)
-		node.processReadyToRead(ud)
-		node.processDroppedEntries(ud)
-		node.processDroppedReadIndexes(ud)
-		node.processLogQuery(ud.LogQueryResult)
-		node.processLeaderUpdate(ud.LeaderUpdate)
-	}
-	if err := e.logdb.SaveRaftState(nodeUpdates, workerID); err != nil {
+		pc.set(processRaftUpdateOp, node)
+		labels.do(node, func() {
+			node.sendReplicateMessages(ud)
+			node.processReadyToRead(ud)
+			node.processDroppedEntries(ud)
+			node.processDroppedReadIndexes(ud)
+			node.processUncommittedEntries(ud)
+			node.processLogQuery(ud.LogQueryResult)
+			node.processLeaderUpdate(ud.LeaderUpdate)
+		})
+	}
+	start := e.metrics.logDBSaveStarted(len(nodeUpdates))
+	saveStart := time.Now()
+	for _, ud := range nodeUpdates {
+		nodes[ud.ShardID].degraded.diskStarted(saveStart)
+	}
+	if len(nodeUpdates) == 1 {
+		pc.set(saveRaftStateOp, nodes[nodeUpdates[0].ShardID])
+		pc.setRange(getEntryRange(nodeUpdates[0].EntriesToSave))
+	} else {
+		pc.setShared(saveRaftStateOp)
+	}
+	err := e.saveRaftState(nodeUpdates, nodes, workerID)
+	e.metrics.logDBSaved(start)
+	if err != nil {
 		return err
 	}
+	if err := failpoint.Inject(failpoint.AfterSaveRaftState); err != nil {
+		return err
+	}
+	elapsed := time.Since(saveStart)
+	e.stats.step[workerID-1].logDBSaved(elapsed)
+	for _, ud := range nodeUpdates {
+		nodes[ud.ShardID].slowOps.diskSaved(elapsed)
+		nodes[ud.ShardID].degraded.diskSaved(elapsed)
+	}
+	pc.setShared(processRaftUpdateOp)
 	if err := e.onSnapshotSaved(nodeUpdates, nodes); err != nil {
 		return err
 	}
@@ -1350,7 +1650,11 @@ func (e *engine) processSteps(workerID uint64,
 	}
 	for _, ud := range nodeUpdates {
 		node := nodes[ud.ShardID]
-		if err := node.processRaftUpdate(ud); err != nil {
+		var err error
+		pc.set(processRaftUpdateOp, node)
+		pc.setRange(getEntryRange(ud.EntriesToSave))
+		labels.do(node, func() { err = node.processRaftUpdate(ud) })
+		if err != nil {
 			return err
 		}
 		e.processMoreCommittedEntries(ud)
@@ -1359,6 +1663,7 @@ func (e *engine) processSteps(workerID uint64,
 	if lazyFreeCycle > 0 {
 		resetNodeUpdate(nodeUpdates)
 	}
+	e.nh.flushEvents()
 	return nil
 }
 
@@ -1382,17 +1687,20 @@ func (e *engine) applySnapshotAndUpdate(updates []pb.Update,
 	nodes map[uint64]*node, fastApply bool) error {
 	notifyCommit := false
 	for _, ud := range updates {
-		if ud.FastApply != fastApply {
-			continue
-		}
 		node := nodes[ud.ShardID]
 		if node.notifyCommit {
 			notifyCommit = true
 		}
+		if ud.FastApply != fastApply {
+			if fastApply {
+				node.applyPersistedEntries(ud)
+			}
+			continue
+		}
 		if err := node.processSnapshot(ud); err != nil {
 			return err
 		}
-		node.applyRaftUpdates(ud)
+		node.applyRaftUpdates(ud, !fastApply)
 	}
 	if !notifyCommit {
 		e.setApplyReadyByUpdates(updates)
@@ -1407,7 +1715,7 @@ func (e *engine) onSnapshotSaved(updates []pb.Update,
 	for _, ud := range updates {
 		if !pb.IsEmptySnapshot(ud.Snapshot) {
 			node := nodes[ud.ShardID]
-			if err := node.removeSnapshotFlagFile(ud.Snapshot.Index); err != nil {
+			if err := node.removeSnapshotFlagFile(ud.Snapshot); err != nil {
 				return err
 			}
 		}
@@ -1416,7 +1724,12 @@ func (e *engine) onSnapshotSaved(updates []pb.Update,
 }
 
 func (e *engine) setCloseReady(n *node) {
-	e.cp.ready <- closeReq{node: n}
+	req := closeReq{node: n}
+	if e.sharedClose {
+		e.closing.Add(1)
+		req.done = e.closing.Done
+	}
+	e.cp.ready <- req
 }
 
 func (e *engine) setStepReadyByMessageBatch(mb pb.MessageBatch) {
@@ -1431,6 +1744,10 @@ func (e *engine) setStepReady(shardID uint64) {
 	e.stepWorkReady.shardReady(shardID)
 }
 
+func (e *engine) setStepReadyDeferred(shardID uint64) {
+	e.stepWorkReady.shardReadyDeferred(shardID)
+}
+
 func (e *engine) setCommitReadyByUpdates(updates []pb.Update) {
 	e.commitWorkReady.shardReadyByUpdates(updates)
 }
@@ -16,6 +16,9 @@ package dragonboat
 
 import (
 	"testing"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/rsm"
 )
 
 func TestBitmapAdd(t *testing.T) {
@@ -69,6 +72,42 @@ func TestPartitionerWorksAsExpected(t *testing.T) {
 	}
 }
 
+func TestApplyWorkReadyUsesWorkerAffinity(t *testing.T) {
+	cfg := config.GetDefaultEngineConfig()
+	cfg.ApplyShards = 4
+	p := newApplyWorkReady(cfg).getPartitioner()
+	for i := uint64(0); i < uint64(128); i++ {
+		if idx := p.GetPartitionID(i); idx != i%4 {
+			t.Errorf("shard %d assigned to %d, want %d", i, idx, i%4)
+		}
+	}
+	cfg.WorkerAffinity = func(shardID uint64) uint64 {
+		if shardID == 1 {
+			return 3
+		}
+		return shardID % 3
+	}
+	wr := newApplyWorkReady(cfg)
+	p = wr.getPartitioner()
+	for i := uint64(0); i < uint64(128); i++ {
+		idx := p.GetPartitionID(i)
+		if i == 1 && idx != 3 {
+			t.Errorf("shard 1 assigned to %d", idx)
+		}
+		if i != 1 && idx == 3 {
+			t.Errorf("shard %d assigned to the isolated worker", i)
+		}
+	}
+	wr.shardReady(1)
+	if wr.readyCount(4) != 1 {
+		t.Errorf("shard not set as ready on the isolated worker")
+	}
+	cfg.WorkerAffinity = func(uint64) uint64 { return 6 }
+	if idx := newApplyWorkReady(cfg).getPartitioner().GetPartitionID(1); idx != 2 {
+		t.Errorf("worker index not wrapped around, %d", idx)
+	}
+}
+
 func TestAllShardsReady(t *testing.T) {
 	wr := newWorkReady(4)
 	nodes := make([]*node, 0)
@@ -220,6 +259,89 @@ func TestBusyMapKeyIsIgnoredWhenUpdatingLoadedNodes(t *testing.T) {
 	}
 }
 
+func newLimitedTestWorkerPool(limits ssLimits) *workerPool {
+	return &workerPool{
+		limits:     limits,
+		nodes:      make(map[uint64]*node),
+		saving:     make(map[uint64]struct{}),
+		recovering: make(map[uint64]struct{}),
+		streaming:  make(map[uint64]uint64),
+	}
+}
+
+func addTestJob(p *workerPool, shardID uint64, task rsm.Task) *node {
+	n := &node{shardID: shardID}
+	p.nodes[shardID] = n
+	p.pending = append(p.pending, job{task: task, node: n, shardID: shardID})
+	return n
+}
+
+func TestWorkerPoolLimitsConcurrentSnapshots(t *testing.T) {
+	p := newLimitedTestWorkerPool(ssLimits{saving: 1, recovering: 1})
+	save := job{task: rsm.Task{Save: true}, shardID: 1}
+	rec := job{task: rsm.Task{Recover: true}, shardID: 1}
+	if !p.canSchedule(save) || !p.canSchedule(rec) {
+		t.Fatalf("failed to schedule")
+	}
+	p.saving[2] = struct{}{}
+	if p.canSchedule(save) {
+		t.Errorf("save limit not enforced")
+	}
+	if !p.canSchedule(rec) {
+		t.Errorf("recovery blocked by saves")
+	}
+	p.recovering[3] = struct{}{}
+	if p.canSchedule(rec) {
+		t.Errorf("recovery limit not enforced")
+	}
+	unlimited := newLimitedTestWorkerPool(ssLimits{})
+	unlimited.saving[2] = struct{}{}
+	unlimited.recovering[3] = struct{}{}
+	if !unlimited.canSchedule(save) || !unlimited.canSchedule(rec) {
+		t.Errorf("unexpectedly limited")
+	}
+}
+
+func TestWorkerPoolSchedulesRecoveriesAndPrioritizedSavesFirst(t *testing.T) {
+	p := newLimitedTestWorkerPool(ssLimits{saving: 1})
+	n1 := addTestJob(p, 1, rsm.Task{Save: true})
+	n2 := addTestJob(p, 2, rsm.Task{
+		Save:      true,
+		SSRequest: rsm.SSRequest{Prioritized: true},
+	})
+	n3 := addTestJob(p, 3, rsm.Task{Recover: true})
+	n4 := addTestJob(p, 4, rsm.Task{Save: true})
+	p.updateQueuePositions()
+	for _, v := range []struct {
+		n   *node
+		pos uint64
+	}{{n1, 2}, {n2, 1}, {n3, 1}, {n4, 3}} {
+		if pos := v.n.getSnapshotQueuePosition(); pos != v.pos {
+			t.Errorf("shard %d, position %d, want %d", v.n.shardID, pos, v.pos)
+		}
+	}
+	for _, shardID := range []uint64{3, 2, 1, 4} {
+		idx, ok := p.nextJob()
+		if !ok {
+			t.Fatalf("no job to schedule, want shard %d", shardID)
+		}
+		if p.pending[idx].shardID != shardID {
+			t.Fatalf("got shard %d, want %d", p.pending[idx].shardID, shardID)
+		}
+		p.removeFromPending(idx)
+	}
+	if _, ok := p.nextJob(); ok {
+		t.Errorf("unexpected job")
+	}
+	// waiting saves do not block recoveries
+	p.saving[5] = struct{}{}
+	addTestJob(p, 1, rsm.Task{Save: true})
+	addTestJob(p, 3, rsm.Task{Recover: true})
+	if idx, ok := p.nextJob(); !ok || p.pending[idx].shardID != 3 {
+		t.Errorf("recovery not scheduled")
+	}
+}
+
 /*
 func TestWPRemoveFromPending(t *testing.T) {
 	tests := []struct {
@@ -255,3 +377,31 @@ func TestWPRemoveFromPending(t *testing.T) {
 		}
 	}
 }*/
+
+func TestDeferredShardReadyIsNotifiedOnFlush(t *testing.T) {
+	wr := newWorkReady(4)
+	for shardID := uint64(0); shardID < 8; shardID++ {
+		wr.shardReadyDeferred(shardID)
+	}
+	for i := uint64(0); i < 4; i++ {
+		if len(wr.channels[i]) != 0 {
+			t.Fatalf("worker %d notified before flush", i)
+		}
+	}
+	wr.flush()
+	for i := uint64(0); i < 4; i++ {
+		if len(wr.channels[i]) != 1 {
+			t.Errorf("worker %d not notified", i)
+		}
+		if m := wr.maps[i].getReadyShards(); len(m) != 2 {
+			t.Errorf("worker %d, unexpected map size %d", i, len(m))
+		}
+		<-wr.channels[i]
+	}
+	wr.flush()
+	for i := uint64(0); i < 4; i++ {
+		if len(wr.channels[i]) != 0 {
+			t.Errorf("worker %d notified again", i)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+
+	"github.com/lni/dragonboat/v4/config"
+)
+
+// EngineWorkerStats contains the utilization stats of a worker goroutine of
+// the execution engine. All durations and counters are cumulative since the
+// start of the NodeHost.
+type EngineWorkerStats struct {
+	// WorkerID is the ID of the worker, it is stable for the lifetime of the
+	// NodeHost instance. Shards are assigned to step, commit and apply workers
+	// by their shard IDs, the step worker with ID i saves its Raft state to the
+	// LogDB shard with the same ID.
+	WorkerID uint64
+	// Busy is the total time spent on processing shards.
+	Busy time.Duration
+	// Idle is the total time spent on waiting for shards to process.
+	Idle time.Duration
+	// LogDBSave is the total time spent on saving Raft state to the LogDB, it
+	// is included in Busy. It is only available for step workers.
+	LogDBSave time.Duration
+	// Iterations is the number of processing iterations.
+	Iterations uint64
+	// Processed is the total number of shards processed in all iterations.
+	Processed uint64
+	// LastBatchSize is the number of shards processed in the last iteration.
+	LastBatchSize uint64
+	// QueueLength is the number of shards ready to be processed by the worker.
+	// Snapshot and close workers have at most one pending job.
+	QueueLength uint64
+}
+
+// Utilization returns the fraction of time the worker was busy.
+func (s EngineWorkerStats) Utilization() float64 {
+	total := s.Busy + s.Idle
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Busy) / float64(total)
+}
+
+// EngineStats contains the stats of all worker goroutines of the execution
+// engine, see NodeHost.GetEngineStats for details.
+type EngineStats struct {
+	// StepWorkers are the workers running the Raft protocol and saving Raft
+	// state to the LogDB, see config.EngineConfig.ExecShards.
+	StepWorkers []EngineWorkerStats
+	// CommitWorkers are the workers notifying committed proposals, they are
+	// only available when config.NodeHostConfig.NotifyCommit is set.
+	CommitWorkers []EngineWorkerStats
+	// ApplyWorkers are the workers applying committed entries to the state
+	// machines, see config.EngineConfig.ApplyShards.
+	ApplyWorkers []EngineWorkerStats
+	// SnapshotWorkers are the workers saving, recovering and streaming
+	// snapshots, see config.EngineConfig.SnapshotShards.
+	SnapshotWorkers []EngineWorkerStats
+	// CloseWorkers are the workers closing state machines of stopped replicas,
+	// see config.EngineConfig.CloseShards.
+	CloseWorkers []EngineWorkerStats
+	// SnapshotWrite contains the stats of snapshot data written by snapshot
+	// operations, see config.NodeHostConfig.MaxSnapshotWriteBytesPerSecond.
+	SnapshotWrite SnapshotWriteStats
+	// ReadIndex contains the stats of ReadIndex rounds requested by all shards
+	// for linearizable reads, see config.EngineConfig.ReadBatchDelay.
+	ReadIndex ReadIndexStats
+	// Memory contains the breakdown of memory accounted against the memory
+	// budget, see config.NodeHostConfig.MaxMemoryBytes.
+	Memory MemoryStats
+	// Pending contains the numbers of requests of all shards not completed
+	// yet.
+	Pending PendingRequestStats
+}
+
+// PendingRequestStats contains the numbers of requests made to all shards of
+// the NodeHost that are not completed yet. Requests are completed when they
+// are applied, rejected, dropped or timed out, the numbers are expected to
+// stay bounded under steady load.
+type PendingRequestStats struct {
+	// Proposals is the number of proposals not completed yet.
+	Proposals uint64
+	// Reads is the number of linearizable reads not completed yet.
+	Reads uint64
+	// ConfigChanges is the number of shards with a pending membership change.
+	ConfigChanges uint64
+	// Snapshots is the number of shards with a pending snapshot request.
+	Snapshots uint64
+}
+
+// ReadIndexStats contains the cumulative stats of ReadIndex rounds requested
+// for linearizable reads since the start of the NodeHost.
+type ReadIndexStats struct {
+	// Rounds is the number of ReadIndex rounds requested.
+	Rounds uint64
+	// Reads is the number of linearizable reads served by those rounds.
+	Reads uint64
+}
+
+// AverageBatchSize returns the average number of reads served by each
+// ReadIndex round.
+func (s ReadIndexStats) AverageBatchSize() float64 {
+	if s.Rounds == 0 {
+		return 0
+	}
+	return float64(s.Reads) / float64(s.Rounds)
+}
+
+// readIndexStats tracks ReadIndex rounds requested by all shards, it is
+// updated by step workers and read by other goroutines.
+type readIndexStats struct {
+	rounds uint64
+	reads  uint64
+}
+
+func (r *readIndexStats) requested(reads int) {
+	if r != nil {
+		atomic.AddUint64(&r.rounds, 1)
+		atomic.AddUint64(&r.reads, uint64(reads))
+	}
+}
+
+func (r *readIndexStats) get() ReadIndexStats {
+	return ReadIndexStats{
+		Rounds: atomic.LoadUint64(&r.rounds),
+		Reads:  atomic.LoadUint64(&r.reads),
+	}
+}
+
+// workerStats tracks the utilization of an engine worker. The monotonic clock
+// is only read at iteration boundaries. Fields other than epoch and the
+// metrics are accessed atomically as stats are read by other goroutines.
+type workerStats struct {
+	epoch      time.Time
+	queue      func() uint64
+	batchSize  *metrics.Histogram
+	workerID   uint64
+	busy       int64
+	idle       int64
+	logDBSave  int64
+	started    int64
+	ended      int64
+	active     int32
+	iterations uint64
+	processed  uint64
+	lastBatch  uint64
+}
+
+func newWorkerStats(epoch time.Time,
+	workerID uint64, queue func() uint64) *workerStats {
+	return &workerStats{
+		epoch:    epoch,
+		queue:    queue,
+		workerID: workerID,
+		ended:    int64(time.Since(epoch)),
+	}
+}
+
+func (w *workerStats) begin() {
+	if w == nil {
+		return
+	}
+	now := int64(time.Since(w.epoch))
+	atomic.AddInt64(&w.idle, now-atomic.LoadInt64(&w.ended))
+	atomic.StoreInt64(&w.started, now)
+	atomic.StoreInt32(&w.active, 1)
+}
+
+func (w *workerStats) end(batch int) {
+	if w == nil {
+		return
+	}
+	now := int64(time.Since(w.epoch))
+	atomic.AddInt64(&w.busy, now-atomic.LoadInt64(&w.started))
+	atomic.StoreInt64(&w.ended, now)
+	atomic.StoreInt32(&w.active, 0)
+	atomic.AddUint64(&w.iterations, 1)
+	atomic.AddUint64(&w.processed, uint64(batch))
+	atomic.StoreUint64(&w.lastBatch, uint64(batch))
+	if w.batchSize != nil {
+		w.batchSize.Update(float64(batch))
+	}
+}
+
+func (w *workerStats) logDBSaved(d time.Duration) {
+	if w != nil {
+		atomic.AddInt64(&w.logDBSave, int64(d))
+	}
+}
+
+func (w *workerStats) get() EngineWorkerStats {
+	now := int64(time.Since(w.epoch))
+	busy := atomic.LoadInt64(&w.busy)
+	idle := atomic.LoadInt64(&w.idle)
+	// time spent in the current busy or idle period is included
+	if atomic.LoadInt32(&w.active) == 1 {
+		busy += now - atomic.LoadInt64(&w.started)
+	} else {
+		idle += now - atomic.LoadInt64(&w.ended)
+	}
+	s := EngineWorkerStats{
+		WorkerID:      w.workerID,
+		Busy:          time.Duration(busy),
+		Idle:          time.Duration(idle),
+		LogDBSave:     time.Duration(atomic.LoadInt64(&w.logDBSave)),
+		Iterations:    atomic.LoadUint64(&w.iterations),
+		Processed:     atomic.LoadUint64(&w.processed),
+		LastBatchSize: atomic.LoadUint64(&w.lastBatch),
+	}
+	if w.queue != nil {
+		s.QueueLength = w.queue()
+	}
+	return s
+}
+
+// engineStats contains the stats of all engine workers.
+type engineStats struct {
+	step     []*workerStats
+	commit   []*workerStats
+	apply    []*workerStats
+	snapshot []*workerStats
+	close    []*workerStats
+	reads    readIndexStats
+}
+
+func newEngineStats(cfg config.EngineConfig, notifyCommit bool) *engineStats {
+	epoch := time.Now()
+	workers := func(count uint64, firstID uint64) []*workerStats {
+		result := make([]*workerStats, 0, count)
+		for i := uint64(0); i < count; i++ {
+			result = append(result, newWorkerStats(epoch, i+firstID, nil))
+		}
+		return result
+	}
+	s := &engineStats{
+		// step, commit and apply workers are 1-based
+		step:     workers(cfg.ExecShards, 1),
+		apply:    workers(cfg.ApplyShards, 1),
+		snapshot: workers(cfg.SnapshotShards, 0),
+		close:    workers(cfg.CloseShards, 0),
+	}
+	if notifyCommit {
+		s.commit = workers(cfg.CommitShards, 1)
+	}
+	return s
+}
+
+// setReadyQueues sets the queue length of each worker to the number of shards
+// marked as ready in wr.
+func setReadyQueues(workers []*workerStats, wr *workReady) {
+	for _, w := range workers {
+		workerID := w.workerID
+		w.queue = func() uint64 { return wr.readyCount(workerID) }
+	}
+}
+
+func getWorkerStats(workers []*workerStats) []EngineWorkerStats {
+	result := make([]EngineWorkerStats, 0, len(workers))
+	for _, w := range workers {
+		result = append(result, w.get())
+	}
+	return result
+}
+
+func (s *engineStats) get() EngineStats {
+	return EngineStats{
+		StepWorkers:     getWorkerStats(s.step),
+		CommitWorkers:   getWorkerStats(s.commit),
+		ApplyWorkers:    getWorkerStats(s.apply),
+		SnapshotWorkers: getWorkerStats(s.snapshot),
+		CloseWorkers:    getWorkerStats(s.close),
+		ReadIndex:       s.reads.get(),
+	}
+}
+
+// GetEngineStats returns the utilization stats of the worker goroutines of the
+// execution engine, e.g. the busy and idle time of each step worker. It helps
+// to decide whether worker counts specified in config.EngineConfig should be
+// changed. The stats are also exported as metrics when
+// config.NodeHostConfig.EnableMetrics is set.
+func (nh *NodeHost) GetEngineStats() EngineStats {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return EngineStats{}
+	}
+	stats := nh.engine.stats.get()
+	stats.SnapshotWrite = nh.ssLimiter.stats()
+	stats.Memory = nh.getMemoryStats()
+	stats.Pending = nh.getPendingRequestStats()
+	return stats
+}
+
+func (nh *NodeHost) getPendingRequestStats() PendingRequestStats {
+	var stats PendingRequestStats
+	nh.forEachShard(func(shardID uint64, n *node) bool {
+		stats.Proposals += n.pendingProposals.count()
+		stats.Reads += n.pendingReadIndexes.count()
+		if n.pendingConfigChange.requested() {
+			stats.ConfigChanges++
+		}
+		if n.pendingSnapshot.requested() {
+			stats.Snapshots++
+		}
+		return true
+	})
+	return stats
+}
@@ -0,0 +1,260 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func TestWorkerStatsTracksBusyAndIdleTime(t *testing.T) {
+	queued := uint64(3)
+	w := newWorkerStats(time.Now(), 2, func() uint64 { return queued })
+	time.Sleep(5 * time.Millisecond)
+	w.begin()
+	time.Sleep(10 * time.Millisecond)
+	s := w.get()
+	if s.Busy < 10*time.Millisecond || s.Idle < 5*time.Millisecond {
+		t.Errorf("current period not included, %+v", s)
+	}
+	w.end(4)
+	w.begin()
+	w.end(2)
+	w.logDBSaved(time.Millisecond)
+	s = w.get()
+	if s.WorkerID != 2 || s.Iterations != 2 || s.Processed != 6 ||
+		s.LastBatchSize != 2 || s.QueueLength != 3 ||
+		s.LogDBSave != time.Millisecond {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	if u := s.Utilization(); u <= 0 || u >= 1 {
+		t.Errorf("unexpected utilization %f", u)
+	}
+	if (EngineWorkerStats{}).Utilization() != 0 {
+		t.Errorf("unexpected utilization")
+	}
+	var nilStats *workerStats
+	nilStats.begin()
+	nilStats.end(1)
+	nilStats.logDBSaved(time.Second)
+}
+
+func TestEngineStatsMatchesEngineConfig(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.NotifyCommit = true
+			c.Expert.Engine = config.EngineConfig{
+				ExecShards:     3,
+				CommitShards:   2,
+				ApplyShards:    4,
+				SnapshotShards: 5,
+				CloseShards:    1,
+			}
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			s := nh.GetEngineStats()
+			for _, v := range []struct {
+				workers []EngineWorkerStats
+				count   int
+				firstID uint64
+			}{
+				{s.StepWorkers, 3, 1},
+				{s.CommitWorkers, 2, 1},
+				{s.ApplyWorkers, 4, 1},
+				{s.SnapshotWorkers, 5, 0},
+				{s.CloseWorkers, 1, 0},
+			} {
+				if len(v.workers) != v.count {
+					t.Fatalf("got %d workers, want %d", len(v.workers), v.count)
+				}
+				for i, w := range v.workers {
+					if w.WorkerID != uint64(i)+v.firstID {
+						t.Errorf("unexpected worker ID %d", w.WorkerID)
+					}
+				}
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestEngineWorkerUtilizationRisesUnderLoad(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &cpuBoundSM{}
+		},
+		tf: func(nh *NodeHost) {
+			idx := nh.engine.applyWorkReady.getPartitioner().GetPartitionID(1)
+			before := nh.GetEngineStats().ApplyWorkers[idx]
+			proposeTestData(t, nh, "load", 50)
+			after := nh.GetEngineStats().ApplyWorkers[idx]
+			// each proposal takes at least 1ms to be applied
+			busy := after.Busy - before.Busy
+			if busy < 50*time.Millisecond {
+				t.Errorf("busy time didn't rise, %v", busy)
+			}
+			if after.Iterations <= before.Iterations ||
+				after.Processed <= before.Processed {
+				t.Errorf("counters didn't rise, %+v, %+v", before, after)
+			}
+			step := nh.GetEngineStats().StepWorkers
+			saved := false
+			for _, w := range step {
+				if w.LogDBSave > 0 {
+					saved = true
+				}
+			}
+			if !saved {
+				t.Errorf("LogDB save time not recorded, %+v", step)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestWorkerAffinityIsolatesShardOnApplyWorker(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &cpuBoundSM{}
+		},
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.Expert.Engine.ApplyShards = 4
+			c.Expert.Engine.WorkerAffinity = func(shardID uint64) uint64 {
+				if shardID == 1 {
+					return 3
+				}
+				return 0
+			}
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			before := nh.GetEngineStats().ApplyWorkers
+			proposeTestData(t, nh, "load", 50)
+			after := nh.GetEngineStats().ApplyWorkers
+			if len(after) != 4 {
+				t.Fatalf("got %d apply workers, want 4", len(after))
+			}
+			// shard 1 would be assigned to the second worker by default
+			if busy := after[3].Busy - before[3].Busy; busy < 50*time.Millisecond {
+				t.Errorf("isolated worker not busy, %v", busy)
+			}
+			for i := 0; i < 3; i++ {
+				if after[i].Processed != before[i].Processed {
+					t.Errorf("worker %d processed shard 1, %+v, %+v",
+						i, before[i], after[i])
+				}
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestReadIndexStatsAreUpdatedByCoalescedReads(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.Expert.Engine.ReadBatchDelay = 20 * time.Millisecond
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			before := nh.GetEngineStats().ReadIndex
+			readers := 8
+			count := 10
+			var wg sync.WaitGroup
+			for i := 0; i < readers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < count; j++ {
+						ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+						_, err := nh.SyncRead(ctx, 1, nil)
+						cancel()
+						if err != nil {
+							t.Errorf("failed to read, %v", err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			after := nh.GetEngineStats().ReadIndex
+			reads := after.Reads - before.Reads
+			rounds := after.Rounds - before.Rounds
+			if reads != uint64(readers*count) {
+				t.Errorf("got %d reads, want %d", reads, readers*count)
+			}
+			if rounds == 0 || rounds > reads {
+				t.Errorf("unexpected rounds %d, reads %d", rounds, reads)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestPendingRequestStatsCountsIncompleteRequests(t *testing.T) {
+	fs := vfs.GetTestFS()
+	unblockC := make(chan struct{})
+	to := &testOption{
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &blockingTestSM{unblockC: unblockC}
+		},
+		tf: func(nh *NodeHost) {
+			session := nh.GetNoOPSession(1)
+			var requests []*RequestState
+			for _, cmd := range []string{"block", "test", "test"} {
+				rs, err := nh.Propose(session, []byte(cmd), pto(nh))
+				if err != nil {
+					t.Fatalf("failed to make proposal %v", err)
+				}
+				requests = append(requests, rs)
+			}
+			// wait for the proposals to be committed
+			time.Sleep(50 * time.Millisecond)
+			rs, err := nh.ReadIndex(1, pto(nh))
+			if err != nil {
+				t.Fatalf("failed to read %v", err)
+			}
+			requests = append(requests, rs)
+			// the read is completed only after the blocked entry is applied
+			time.Sleep(50 * time.Millisecond)
+			p := nh.GetEngineStats().Pending
+			if p.Proposals != 3 || p.Reads != 1 ||
+				p.ConfigChanges != 0 || p.Snapshots != 0 {
+				t.Errorf("unexpected pending requests %+v", p)
+			}
+			close(unblockC)
+			for _, rs := range requests {
+				<-rs.ResultC()
+				rs.Release()
+			}
+			if p := nh.GetEngineStats().Pending; p != (PendingRequestStats{}) {
+				t.Errorf("unexpected pending requests %+v", p)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
@@ -0,0 +1,274 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	// ensureRetryInterval is the interval between two attempts made by
+	// EnsureShard to start a replica that is still being stopped.
+	ensureRetryInterval = 10 * time.Millisecond
+)
+
+// ShardStartSpec is the specification of a local replica used by
+// NodeHost.EnsureShard.
+type ShardStartSpec struct {
+	// InitialMembers is the initial members map passed to StartReplica, it
+	// must be empty when Join is true.
+	InitialMembers map[uint64]Target
+	// Join indicates whether the replica joins the shard as a new member
+	// rather than being one of its initial members.
+	Join bool
+	// Factory is the state machine factory, see BootstrapShard for the
+	// supported types.
+	Factory interface{}
+	// Config is the config of the replica.
+	Config config.Config
+}
+
+// EnsureResult is the action taken by NodeHost.EnsureShard.
+type EnsureResult int
+
+const (
+	// EnsureAlreadyRunning indicates that the replica was already running.
+	EnsureAlreadyRunning EnsureResult = iota
+	// EnsureRestarted indicates that the stopped replica was restarted from
+	// its existing data.
+	EnsureRestarted
+	// EnsureStarted indicates that the replica was started for the first time
+	// as an initial member of the shard.
+	EnsureStarted
+	// EnsureJoined indicates that the replica was started for the first time
+	// as a new member joining the shard.
+	EnsureJoined
+)
+
+var ensureResultNames = [...]string{
+	EnsureAlreadyRunning: "AlreadyRunning",
+	EnsureRestarted:      "Restarted",
+	EnsureStarted:        "Started",
+	EnsureJoined:         "Joined",
+}
+
+func (r EnsureResult) String() string {
+	if r < EnsureAlreadyRunning || r > EnsureJoined {
+		return fmt.Sprintf("EnsureResult(%d)", int(r))
+	}
+	return ensureResultNames[r]
+}
+
+// ensureLocks serializes EnsureShard calls made for the same shard.
+type ensureLocks struct {
+	mu    sync.Mutex
+	locks map[uint64]*ensureLock
+}
+
+type ensureLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+// lock acquires the lock of the specified shard, the returned function
+// releases it.
+func (l *ensureLocks) lock(ctx context.Context,
+	shardID uint64) (func(), error) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[uint64]*ensureLock)
+	}
+	el, ok := l.locks[shardID]
+	if !ok {
+		el = &ensureLock{ch: make(chan struct{}, 1)}
+		l.locks[shardID] = el
+	}
+	el.refs++
+	l.mu.Unlock()
+	release := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		el.refs--
+		if el.refs == 0 {
+			delete(l.locks, shardID)
+		}
+	}
+	select {
+	case el.ch <- struct{}{}:
+		return func() {
+			<-el.ch
+			release()
+		}, nil
+	case <-ctx.Done():
+		release()
+		return nil, getContextError(ctx)
+	}
+}
+
+// EnsureShard makes sure that the local replica specified by spec is running,
+// it is idempotent and safe to be invoked repeatedly, e.g. by reconcilers of
+// multiple controllers. Concurrent calls made for the same shard are
+// serialized.
+//
+// EnsureAlreadyRunning is returned when the replica is already running. The
+// replica is restarted from its existing data when it is not running but has
+// been bootstrapped on the NodeHost, EnsureRestarted is returned in such case.
+// Otherwise the replica is started for the first time as an initial member or
+// as a joining member according to spec.Join, EnsureStarted or EnsureJoined is
+// returned.
+//
+// ErrBootstrapMismatch is returned when the spec conflicts with the running
+// replica or with the recorded bootstrap info of the replica, e.g. the replica
+// was bootstrapped with different initial members, as a joining member or with
+// a different state machine type. ErrReplicaRemoved is returned when the
+// replica has been removed from the NodeHost.
+func (nh *NodeHost) EnsureShard(ctx context.Context,
+	spec ShardStartSpec) (EnsureResult, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return EnsureAlreadyRunning, ErrClosed
+	}
+	if _, _, err := getFactory(spec.Factory); err != nil {
+		return EnsureAlreadyRunning, err
+	}
+	unlock, err := nh.ensureLocks.lock(ctx, spec.Config.ShardID)
+	if err != nil {
+		return EnsureAlreadyRunning, err
+	}
+	defer unlock()
+	for {
+		result, err := nh.ensureShard(spec)
+		if !errors.Is(err, ErrShardAlreadyExist) {
+			return result, err
+		}
+		// the replica is still being stopped
+		timer := time.NewTimer(ensureRetryInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return EnsureAlreadyRunning, getContextError(ctx)
+		}
+	}
+}
+
+func (nh *NodeHost) ensureShard(spec ShardStartSpec) (EnsureResult, error) {
+	cfg := spec.Config
+	if n, ok := nh.getShard(cfg.ShardID); ok {
+		if n.replicaID != cfg.ReplicaID {
+			return EnsureAlreadyRunning, errors.Wrapf(ErrBootstrapMismatch,
+				"%s is running", dn(cfg.ShardID, n.replicaID))
+		}
+		if n.config.IsWitness != cfg.IsWitness {
+			return EnsureAlreadyRunning, errors.Wrapf(ErrBootstrapMismatch,
+				"%s is running, witness %t", dn(cfg.ShardID, n.replicaID),
+				n.config.IsWitness)
+		}
+	}
+	bi, ok, err := nh.getBootstrapInfo(cfg.ShardID, cfg.ReplicaID)
+	if err != nil {
+		return EnsureAlreadyRunning, err
+	}
+	if ok {
+		if err := checkShardStartSpec(spec, bi); err != nil {
+			return EnsureAlreadyRunning, err
+		}
+		if _, ok := nh.getShard(cfg.ShardID); ok {
+			return EnsureAlreadyRunning, nil
+		}
+		// the recorded bootstrap info is used to restart the replica
+		if err := startWithFactory(nh,
+			nil, false, spec.Factory, cfg); err != nil {
+			return EnsureAlreadyRunning, err
+		}
+		plog.Infof("%s restarted by EnsureShard", dn(cfg.ShardID, cfg.ReplicaID))
+		return EnsureRestarted, nil
+	}
+	if err := startWithFactory(nh,
+		spec.InitialMembers, spec.Join, spec.Factory, cfg); err != nil {
+		return EnsureAlreadyRunning, err
+	}
+	plog.Infof("%s started by EnsureShard, join %t",
+		dn(cfg.ShardID, cfg.ReplicaID), spec.Join)
+	if spec.Join {
+		return EnsureJoined, nil
+	}
+	return EnsureStarted, nil
+}
+
+// checkShardStartSpec checks whether the spec is consistent with the recorded
+// bootstrap info of the replica.
+func checkShardStartSpec(spec ShardStartSpec, bi pb.Bootstrap) error {
+	_, smType, err := getFactory(spec.Factory)
+	if err != nil {
+		return err
+	}
+	cfg := spec.Config
+	if bi.Type != pb.UnknownStateMachine && bi.Type != smType {
+		return errors.Wrapf(ErrBootstrapMismatch,
+			"%s bootstrapped with %s, got %s",
+			dn(cfg.ShardID, cfg.ReplicaID), bi.Type, smType)
+	}
+	if bi.WriteFsyncMode != uint32(cfg.WriteFsyncMode) {
+		return errors.Wrapf(ErrBootstrapMismatch,
+			"%s bootstrapped with write fsync mode %d, got %d",
+			dn(cfg.ShardID, cfg.ReplicaID), bi.WriteFsyncMode, cfg.WriteFsyncMode)
+	}
+	if bi.Volatile != (cfg.StorageClass == config.Volatile) {
+		return errors.Wrapf(ErrBootstrapMismatch,
+			"%s bootstrapped with volatile %t, got storage class %d",
+			dn(cfg.ShardID, cfg.ReplicaID), bi.Volatile, cfg.StorageClass)
+	}
+	if bi.Promoted {
+		// promoted witnesses are restarted as regular nodes
+		return nil
+	}
+	if !bi.Validate(spec.InitialMembers, spec.Join, smType) {
+		return errors.Wrapf(ErrBootstrapMismatch,
+			"%s bootstrapped with join %t, members %v, got join %t, members %v",
+			dn(cfg.ShardID, cfg.ReplicaID), bi.Join, bi.Addresses,
+			spec.Join, spec.InitialMembers)
+	}
+	return nil
+}
+
+// getBootstrapInfo returns the recorded bootstrap info of the specified
+// replica, the returned boolean value indicates whether the replica has been
+// bootstrapped on the NodeHost.
+func (nh *NodeHost) getBootstrapInfo(shardID uint64,
+	replicaID uint64) (pb.Bootstrap, bool, error) {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return pb.Bootstrap{}, false, ErrClosed
+	}
+	bi, err := nh.mu.logdb.GetBootstrapInfo(shardID, replicaID)
+	if errors.Is(err, raftio.ErrNoBootstrapInfo) {
+		return pb.Bootstrap{}, false, nil
+	}
+	if err != nil {
+		return pb.Bootstrap{}, false, err
+	}
+	return bi, true, nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+)
+
+func getEnsureTestSpec(replicaID uint64,
+	members map[uint64]Target) ShardStartSpec {
+	cfg := getBootstrapTestConfig(replicaID)
+	cfg.ShardID = 1
+	return ShardStartSpec{
+		InitialMembers: members,
+		Factory:        newCloneTestSM,
+		Config:         cfg,
+	}
+}
+
+func TestEnsureResultString(t *testing.T) {
+	if v := EnsureRestarted.String(); v != "Restarted" {
+		t.Errorf("unexpected name %s", v)
+	}
+	if v := EnsureResult(100).String(); v != "EnsureResult(100)" {
+		t.Errorf("unexpected name %s", v)
+	}
+}
+
+func TestEnsureShardIsIdempotentAcrossRestarts(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := make(map[uint64]Target)
+		for i := range nhs {
+			members[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		// each NodeHost is reconciled by multiple concurrent callers
+		ensure := func(expected EnsureResult) {
+			const callers = 4
+			results := make([][]EnsureResult, len(nhs))
+			errs := make([][]error, len(nhs))
+			var wg sync.WaitGroup
+			for i := range nhs {
+				results[i] = make([]EnsureResult, callers)
+				errs[i] = make([]error, callers)
+				for j := 0; j < callers; j++ {
+					i, j := i, j
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						ctx, cancel := context.WithTimeout(context.Background(),
+							lpto(nhs[i]))
+						defer cancel()
+						results[i][j], errs[i][j] = nhs[i].EnsureShard(ctx,
+							getEnsureTestSpec(uint64(i+1), members))
+					}()
+				}
+			}
+			wg.Wait()
+			for i := range nhs {
+				count := make(map[EnsureResult]int)
+				for j := 0; j < callers; j++ {
+					if errs[i][j] != nil {
+						t.Fatalf("EnsureShard failed on nh %d, %v", i, errs[i][j])
+					}
+					count[results[i][j]]++
+				}
+				if count[expected] != 1 || count[EnsureAlreadyRunning] != callers-1 {
+					t.Fatalf("nh %d, expected %s, got %v", i, expected, count)
+				}
+			}
+			for _, nh := range nhs {
+				waitForLeaderToBeElected(t, nh, 1)
+			}
+		}
+		propose := func(cmd string) {
+			ctx, cancel := context.WithTimeout(context.Background(), lpto(nhs[0]))
+			defer cancel()
+			if _, err := nhs[0].SyncPropose(ctx,
+				nhs[0].GetNoOPSession(1), []byte(cmd)); err != nil {
+				t.Fatalf("failed to propose %v", err)
+			}
+		}
+		ensure(EnsureStarted)
+		propose("a=0")
+		for cycle := 1; cycle <= 3; cycle++ {
+			for i, nh := range nhs {
+				if cycle%2 == 0 {
+					nhc := nh.NodeHostConfig()
+					nh.Close()
+					nh, err := NewNodeHost(nhc)
+					if err != nil {
+						t.Fatalf("failed to create nodehost %v", err)
+					}
+					nhs[i] = nh
+				} else if err := nh.StopShard(1); err != nil {
+					t.Fatalf("failed to stop shard %v", err)
+				}
+			}
+			ensure(EnsureRestarted)
+			propose(fmt.Sprintf("a=%d", cycle))
+			if v := readCloneTestValue(t, nhs[2], 1, "a"); v != fmt.Sprint(cycle) {
+				t.Errorf("unexpected value %s", v)
+			}
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
+
+func TestEnsureShardJoinsAndDetectsMismatchedSpec(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := map[uint64]Target{1: memtransport.Address(1)}
+		ensure := func(nh *NodeHost, spec ShardStartSpec) (EnsureResult, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), lpto(nh))
+			defer cancel()
+			return nh.EnsureShard(ctx, spec)
+		}
+		if r, err := ensure(nhs[0], getEnsureTestSpec(1, members)); err != nil ||
+			r != EnsureStarted {
+			t.Fatalf("unexpected result %s, %v", r, err)
+		}
+		waitForLeaderToBeElected(t, nhs[0], 1)
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(nhs[0]))
+		defer cancel()
+		if err := nhs[0].SyncRequestAddReplica(ctx,
+			1, 2, memtransport.Address(2), 0); err != nil {
+			t.Fatalf("failed to add replica %v", err)
+		}
+		join := getEnsureTestSpec(2, nil)
+		join.Join = true
+		if r, err := ensure(nhs[1], join); err != nil || r != EnsureJoined {
+			t.Fatalf("unexpected result %s, %v", r, err)
+		}
+		if r, err := ensure(nhs[1], join); err != nil || r != EnsureAlreadyRunning {
+			t.Fatalf("unexpected result %s, %v", r, err)
+		}
+		waitForLeaderToBeElected(t, nhs[1], 1)
+		// the running replica has a different replica ID
+		if _, err := ensure(nhs[0],
+			getEnsureTestSpec(3, members)); !errors.Is(err, ErrBootstrapMismatch) {
+			t.Errorf("failed to detect mismatched replica ID, %v", err)
+		}
+		// the joined replica is not an initial member
+		if _, err := ensure(nhs[1],
+			getEnsureTestSpec(2, members)); !errors.Is(err, ErrBootstrapMismatch) {
+			t.Errorf("failed to detect mismatched join, %v", err)
+		}
+		if err := nhs[0].StopShard(1); err != nil {
+			t.Fatalf("failed to stop shard %v", err)
+		}
+		// the stopped replica was bootstrapped with different initial members
+		other := map[uint64]Target{
+			1: memtransport.Address(1),
+			2: memtransport.Address(2),
+		}
+		if _, err := ensure(nhs[0],
+			getEnsureTestSpec(1, other)); !errors.Is(err, ErrBootstrapMismatch) {
+			t.Errorf("failed to detect mismatched members, %v", err)
+		}
+		if _, ok := nhs[0].getShard(1); ok {
+			t.Errorf("replica unexpectedly started")
+		}
+		if r, err := ensure(nhs[0], getEnsureTestSpec(1, members)); err != nil ||
+			r != EnsureRestarted {
+			t.Fatalf("unexpected result %s, %v", r, err)
+		}
+	}
+	memTransportNodeHostTest(t, 2, tf, fs)
+}
@@ -0,0 +1,248 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+)
+
+// RequestErrorStats contains the outcome counters of a type of requests made
+// on the local replica.
+type RequestErrorStats struct {
+	// Completed is the number of requests completed successfully.
+	Completed uint64
+	// Late is the number of requests completed after the context of the
+	// caller of the synchronous API was done, the caller had been returned
+	// with ErrTimeout or ErrCanceled and it never observed the outcome.
+	Late uint64
+	// Errors is the number of failed requests keyed by the error returned to
+	// the caller, e.g. ErrTimeout, ErrRejected or ErrShardNotReady. Requests
+	// failed before being accepted by the replica are also counted.
+	Errors map[error]uint64
+}
+
+// ErrorStats contains the request outcome counters of the local replica of a
+// shard, see NodeHost.GetErrorStats for details.
+type ErrorStats struct {
+	ShardID       uint64
+	Proposals     RequestErrorStats
+	Reads         RequestErrorStats
+	ConfigChanges RequestErrorStats
+	Snapshots     RequestErrorStats
+	// Tenant is the tenant of the shard, it is empty when the shard has no
+	// tenant, see config.NodeHostConfig.TenantOf.
+	Tenant string
+	// TenantRateLimited is the number of proposals made to local replicas of
+	// all shards of the tenant rejected with ErrRateLimited since the NodeHost
+	// was started, it is not reset by ResetErrorStats.
+	TenantRateLimited uint64
+}
+
+// requestCounters counts the outcomes of a type of requests. All methods can
+// be invoked on a nil requestCounters, nothing is recorded in that case.
+type requestCounters struct {
+	mu        sync.Mutex
+	errors    map[error]uint64
+	metrics   *shardMetrics
+	completed uint64
+	late      uint64
+	rt        PendingRequestType
+}
+
+// done records the outcome of a request, it is invoked when the result
+// is delivered to the RequestState. late indicates whether the caller had
+// stopped waiting for the result.
+func (c *requestCounters) done(result RequestResult, late bool) {
+	if c == nil || result.code == requestCommitted {
+		return
+	}
+	if late {
+		atomic.AddUint64(&c.late, 1)
+		c.metrics.requestCompletedLate(c.rt)
+	}
+	if err := getRequestError(result); err != nil {
+		// ErrUnsafeMembershipChange is wrapped with the list of inactive replicas
+		if errors.Is(err, ErrUnsafeMembershipChange) {
+			err = ErrUnsafeMembershipChange
+		}
+		c.failed(err)
+		return
+	}
+	atomic.AddUint64(&c.completed, 1)
+}
+
+// failed records a failed request.
+func (c *requestCounters) failed(err error) {
+	if c == nil || err == nil {
+		return
+	}
+	c.mu.Lock()
+	c.errors[err]++
+	c.mu.Unlock()
+	c.metrics.requestFailed(c.rt, err)
+}
+
+func (c *requestCounters) get() RequestErrorStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	errs := make(map[error]uint64, len(c.errors))
+	for err, count := range c.errors {
+		errs[err] = count
+	}
+	return RequestErrorStats{
+		Completed: atomic.LoadUint64(&c.completed),
+		Late:      atomic.LoadUint64(&c.late),
+		Errors:    errs,
+	}
+}
+
+func (c *requestCounters) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errors = make(map[error]uint64)
+	atomic.StoreUint64(&c.completed, 0)
+	atomic.StoreUint64(&c.late, 0)
+}
+
+// errorStats contains the request outcome counters of a replica.
+type errorStats struct {
+	proposals     requestCounters
+	reads         requestCounters
+	configChanges requestCounters
+	snapshots     requestCounters
+}
+
+func newErrorStats() *errorStats {
+	s := &errorStats{}
+	s.proposals.rt = PendingProposal
+	s.reads.rt = PendingReadIndex
+	s.configChanges.rt = PendingConfigChange
+	s.snapshots.rt = PendingSnapshot
+	for _, c := range s.all() {
+		c.errors = make(map[error]uint64)
+	}
+	return s
+}
+
+func (s *errorStats) all() []*requestCounters {
+	return []*requestCounters{
+		&s.proposals, &s.reads, &s.configChanges, &s.snapshots,
+	}
+}
+
+func (s *errorStats) get(rt PendingRequestType) *requestCounters {
+	if s == nil {
+		return nil
+	}
+	switch rt {
+	case PendingProposal:
+		return &s.proposals
+	case PendingReadIndex:
+		return &s.reads
+	case PendingConfigChange:
+		return &s.configChanges
+	case PendingSnapshot:
+		return &s.snapshots
+	}
+	return nil
+}
+
+func (s *errorStats) setMetrics(m *shardMetrics) {
+	for _, c := range s.all() {
+		c.metrics = m
+	}
+}
+
+// requestSubmitted counts the request of the specified type when it failed
+// before being accepted by the pending queues of the replica.
+func (n *node) requestSubmitted(rt PendingRequestType, err *error) {
+	n.errorStats.get(rt).failed(*err)
+}
+
+// getRequestError returns the error returned to the caller of synchronous
+// APIs for the specified result, nil is returned for completed requests.
+func getRequestError(r RequestResult) error {
+	if r.Completed() {
+		return nil
+	} else if r.Rejected() {
+		if inactive := r.InactiveReplicas(); len(inactive) > 0 {
+			return errors.Wrapf(ErrUnsafeMembershipChange,
+				"inactive replicas %v", inactive)
+		}
+		if r.rejectErr != nil {
+			return r.rejectErr
+		}
+		return ErrRejected
+	} else if r.Timeout() {
+		return ErrTimeout
+	} else if r.Terminated() {
+		return ErrShardClosed
+	} else if r.Dropped() {
+		return ErrShardNotReady
+	} else if r.Aborted() {
+		return ErrAborted
+	}
+	plog.Panicf("unknown v code %v", r)
+	return nil
+}
+
+// GetErrorStats returns the request outcome counters of the local replica of
+// the specified shard. Proposals, ReadIndex requests, membership change
+// requests and snapshot requests are counted separately, each failed request
+// is counted under the error returned to its caller. Counters are cumulative
+// since the start of the replica or the last ResetErrorStats call, they are
+// also exported as metrics when config.NodeHostConfig.EnableMetrics is set.
+func (nh *NodeHost) GetErrorStats(shardID uint64) (ErrorStats, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrorStats{}, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return ErrorStats{}, ErrShardNotFound
+	}
+	s := n.errorStats
+	stats := ErrorStats{
+		ShardID:           shardID,
+		Proposals:         s.proposals.get(),
+		Reads:             s.reads.get(),
+		ConfigChanges:     s.configChanges.get(),
+		Snapshots:         s.snapshots.get(),
+		TenantRateLimited: n.tenant.rateLimited(),
+	}
+	if n.tenant != nil {
+		stats.Tenant = n.tenant.name
+	}
+	return stats, nil
+}
+
+// ResetErrorStats resets the request outcome counters of the local replica of
+// the specified shard returned by GetErrorStats, exported metrics are not
+// affected. It is mostly used in tests.
+func (nh *NodeHost) ResetErrorStats(shardID uint64) error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return ErrShardNotFound
+	}
+	for _, c := range n.errorStats.all() {
+		c.reset()
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func TestRequestCountersClassifyResults(t *testing.T) {
+	rejectErr := errors.New("rejected by the state machine")
+	tests := []struct {
+		result RequestResult
+		late   bool
+		err    error
+	}{
+		{RequestResult{code: requestCompleted}, false, nil},
+		{RequestResult{code: requestTimeout}, false, ErrTimeout},
+		{RequestResult{code: requestRejected}, false, ErrRejected},
+		{RequestResult{code: requestRejected, rejectErr: rejectErr}, false, rejectErr},
+		{RequestResult{code: requestRejected, inactive: []uint64{2}},
+			false, ErrUnsafeMembershipChange},
+		{RequestResult{code: requestTerminated}, false, ErrShardClosed},
+		{RequestResult{code: requestDropped}, false, ErrShardNotReady},
+		{RequestResult{code: requestAborted}, false, ErrAborted},
+		{RequestResult{code: requestCompleted}, true, nil},
+	}
+	for idx, tt := range tests {
+		s := newErrorStats()
+		c := s.get(PendingProposal)
+		c.done(tt.result, tt.late)
+		// committed notifications are followed by the applied result
+		c.done(RequestResult{code: requestCommitted}, tt.late)
+		stats := c.get()
+		if tt.err == nil {
+			if stats.Completed != 1 || len(stats.Errors) != 0 {
+				t.Errorf("%d, unexpected stats %+v", idx, stats)
+			}
+		} else if stats.Completed != 0 || len(stats.Errors) != 1 ||
+			stats.Errors[tt.err] != 1 {
+			t.Errorf("%d, unexpected stats %+v", idx, stats)
+		}
+		if tt.late != (stats.Late == 1) {
+			t.Errorf("%d, unexpected late count %d", idx, stats.Late)
+		}
+		c.reset()
+		stats = c.get()
+		if stats.Completed != 0 || stats.Late != 0 || len(stats.Errors) != 0 {
+			t.Errorf("%d, stats not reset, %+v", idx, stats)
+		}
+	}
+}
+
+func TestNilRequestCountersCanBeUsed(t *testing.T) {
+	var s *errorStats
+	c := s.get(PendingReadIndex)
+	c.done(RequestResult{code: requestTimeout}, true)
+	c.failed(ErrShardNotReady)
+}
+
+func TestLateCompletionIsCounted(t *testing.T) {
+	pp, _ := getPendingProposal(false)
+	s := newErrorStats()
+	pp.setErrorStats(s.get(PendingProposal))
+	session := getBlankTestSession()
+	rs, err := pp.propose(context.Background(), session, []byte("test data"), 100)
+	if err != nil {
+		t.Fatalf("failed to make proposal, %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := getRequestState(ctx, rs); !errors.Is(err, ErrCanceled) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	pp.applied(rs.clientID, rs.seriesID, rs.key, sm.Result{}, false)
+	stats := s.proposals.get()
+	if stats.Completed != 1 || stats.Late != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestErrorStatsCanBeQueried(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.OrderedConfigChange = true
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			session := nh.GetNoOPSession(1)
+			if _, err := nh.SyncPropose(ctx, session, []byte("test-data")); err != nil {
+				t.Fatalf("failed to make proposal, %v", err)
+			}
+			if _, err := nh.SyncRead(ctx, 1, nil); err != nil {
+				t.Fatalf("failed to read, %v", err)
+			}
+			if _, err := nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption); err != nil {
+				t.Fatalf("failed to request snapshot, %v", err)
+			}
+			if err := nh.SyncRequestAddReplica(ctx, 1, 2, "", 0); !errors.Is(err, ErrInvalidAddress) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			membership, err := nh.SyncGetShardMembership(ctx, 1)
+			if err != nil {
+				t.Fatalf("failed to get membership, %v", err)
+			}
+			// the order ID of a membership change must be the current one
+			orderID := membership.ConfigChangeID + 1
+			if err := nh.SyncRequestDeleteReplica(ctx, 1, 2, orderID); !errors.Is(err, ErrRejected) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			stats, err := nh.GetErrorStats(1)
+			if err != nil {
+				t.Fatalf("failed to get error stats, %v", err)
+			}
+			if stats.ShardID != 1 {
+				t.Errorf("unexpected shard ID %d", stats.ShardID)
+			}
+			if stats.Proposals.Completed != 1 || len(stats.Proposals.Errors) != 0 {
+				t.Errorf("unexpected proposal stats %+v", stats.Proposals)
+			}
+			// SyncGetShardMembership is also a ReadIndex request
+			if stats.Reads.Completed != 2 || len(stats.Reads.Errors) != 0 {
+				t.Errorf("unexpected read stats %+v", stats.Reads)
+			}
+			if stats.Snapshots.Completed != 1 || len(stats.Snapshots.Errors) != 0 {
+				t.Errorf("unexpected snapshot stats %+v", stats.Snapshots)
+			}
+			cc := stats.ConfigChanges
+			if cc.Completed != 0 || cc.Errors[ErrInvalidAddress] != 1 ||
+				cc.Errors[ErrRejected] != 1 {
+				t.Errorf("unexpected config change stats %+v", cc)
+			}
+			if err := nh.ResetErrorStats(1); err != nil {
+				t.Fatalf("failed to reset error stats, %v", err)
+			}
+			stats, err = nh.GetErrorStats(1)
+			if err != nil {
+				t.Fatalf("failed to get error stats, %v", err)
+			}
+			if stats.Proposals.Completed != 0 || len(stats.ConfigChanges.Errors) != 0 {
+				t.Errorf("stats not reset, %+v", stats)
+			}
+			if _, err := nh.GetErrorStats(2); !errors.Is(err, ErrShardNotFound) {
+				t.Errorf("unexpected error %v", err)
+			}
+			if err := nh.ResetErrorStats(2); !errors.Is(err, ErrShardNotFound) {
+				t.Errorf("unexpected error %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
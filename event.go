@@ -17,6 +17,7 @@ package dragonboat
 import (
 	"fmt"
 	"io"
+	"sync"
 	"sync/atomic"
 
 	"github.com/VictoriaMetrics/metrics"
@@ -42,8 +43,10 @@ type raftEventListener struct {
 	term                *metrics.Gauge
 	campaignLaunched    *metrics.Counter
 	campaignSkipped     *metrics.Counter
+	sysEvents           *sysEventListener
 	leaderID            uint64
 	termValue           uint64
+	leaderTerm          uint64
 	replicaID           uint64
 	shardID             uint64
 	metrics             bool
@@ -52,12 +55,14 @@ type raftEventListener struct {
 var _ server.IRaftEventListener = (*raftEventListener)(nil)
 
 func newRaftEventListener(shardID uint64, replicaID uint64,
-	useMetrics bool, queue *leaderInfoQueue) *raftEventListener {
+	useMetrics bool, queue *leaderInfoQueue,
+	sysEvents *sysEventListener) *raftEventListener {
 	el := &raftEventListener{
 		shardID:   shardID,
 		replicaID: replicaID,
 		metrics:   useMetrics,
 		queue:     queue,
+		sysEvents: sysEvents,
 	}
 	if useMetrics {
 		label := fmt.Sprintf(`{shardid="%d",replicaid="%d"}`, shardID, replicaID)
@@ -94,6 +99,13 @@ func (e *raftEventListener) close() {
 func (e *raftEventListener) LeaderUpdated(info server.LeaderInfo) {
 	atomic.StoreUint64(&e.leaderID, info.LeaderID)
 	atomic.StoreUint64(&e.termValue, info.Term)
+	// leaderTerm is the term of the local replica's leadership, it is 0 when
+	// the local replica is not the leader
+	if info.LeaderID == e.replicaID && info.LeaderID != raftio.NoLeader {
+		atomic.StoreUint64(&e.leaderTerm, info.Term)
+	} else {
+		atomic.StoreUint64(&e.leaderTerm, 0)
+	}
 	if e.queue != nil {
 		ui := raftio.LeaderInfo{
 			ShardID:   info.ShardID,
@@ -105,6 +117,13 @@ func (e *raftEventListener) LeaderUpdated(info server.LeaderInfo) {
 	}
 }
 
+// isLeader returns a boolean value indicating whether the local replica is
+// the leader and the term of its leadership.
+func (e *raftEventListener) isLeader() (bool, uint64) {
+	term := atomic.LoadUint64(&e.leaderTerm)
+	return term != 0, term
+}
+
 func (e *raftEventListener) CampaignLaunched(info server.CampaignInfo) {
 	if e.metrics {
 		e.campaignLaunched.Add(1)
@@ -117,6 +136,17 @@ func (e *raftEventListener) CampaignSkipped(info server.CampaignInfo) {
 	}
 }
 
+func (e *raftEventListener) CampaignSuppressed(info server.CampaignInfo) {
+	if e.sysEvents != nil {
+		e.sysEvents.Publish(server.SystemEvent{
+			Type:      server.CampaignSuppressed,
+			ShardID:   info.ShardID,
+			ReplicaID: info.ReplicaID,
+			Term:      info.Term,
+		})
+	}
+}
+
 func (e *raftEventListener) SnapshotRejected(info server.SnapshotInfo) {
 	if e.metrics {
 		e.snapshotRejected.Add(1)
@@ -141,18 +171,115 @@ func (e *raftEventListener) ReadIndexDropped(info server.ReadIndexInfo) {
 	}
 }
 
+func (e *raftEventListener) StagedPromotionTimeout(
+	info server.StagedPromotionInfo) {
+	if e.sysEvents != nil {
+		e.sysEvents.Publish(server.SystemEvent{
+			Type:      server.StagedPromotionTimeout,
+			ShardID:   info.ShardID,
+			ReplicaID: info.StagedReplicaID,
+			Index:     info.Match,
+		})
+	}
+}
+
+func (e *raftEventListener) NonVotingLagging(info server.NonVotingLagInfo) {
+	e.publishNonVotingLag(server.NonVotingLagging, info)
+}
+
+func (e *raftEventListener) NonVotingLagRecovered(
+	info server.NonVotingLagInfo) {
+	e.publishNonVotingLag(server.NonVotingLagRecovered, info)
+}
+
+func (e *raftEventListener) publishNonVotingLag(t server.SystemEventType,
+	info server.NonVotingLagInfo) {
+	if e.sysEvents != nil {
+		e.sysEvents.Publish(server.SystemEvent{
+			Type:      t,
+			ShardID:   info.ShardID,
+			ReplicaID: info.NonVotingReplicaID,
+			Index:     info.Match,
+			Lag:       info.Lag,
+		})
+	}
+}
+
+// eventNotifier wakes up the event dispatcher. Notifications made by notify
+// are coalesced when coalesce is set, the dispatcher is only woken up on the
+// next flush call so events of multiple shards produced in the same engine
+// iteration are delivered by a single wakeup.
+type eventNotifier struct {
+	workCh   chan struct{}
+	pending  uint32
+	coalesce bool
+}
+
+func newEventNotifier(coalesce bool) *eventNotifier {
+	return &eventNotifier{
+		workCh:   make(chan struct{}, 1),
+		coalesce: coalesce,
+	}
+}
+
+func (n *eventNotifier) notify() {
+	if n.coalesce {
+		atomic.StoreUint32(&n.pending, 1)
+		return
+	}
+	n.signal()
+}
+
+func (n *eventNotifier) signal() {
+	select {
+	case n.workCh <- struct{}{}:
+	default:
+	}
+}
+
+func (n *eventNotifier) flush() {
+	if n == nil {
+		return
+	}
+	if atomic.LoadUint32(&n.pending) != 0 &&
+		atomic.SwapUint32(&n.pending, 0) != 0 {
+		n.signal()
+	}
+}
+
+func (n *eventNotifier) workReady() chan struct{} {
+	return n.workCh
+}
+
+const (
+	// defaultSysEventQueueSize is the default maximum number of system events
+	// queued for delivery.
+	defaultSysEventQueueSize = 4096
+)
+
+// sysEventListener queues published system events for delivery to the user
+// ISystemEventListener. Publish never blocks, the oldest queued event is
+// dropped when the queue is full.
 type sysEventListener struct {
-	stopc  chan struct{}
-	events chan server.SystemEvent
-	ul     raftio.ISystemEventListener
+	mu       sync.Mutex
+	ul       raftio.ISystemEventListener
+	notifier *eventNotifier
+	events   []server.SystemEvent
+	size     int
+	dropped  uint64
 }
 
+var _ raftio.IEventQueueStats = (*sysEventListener)(nil)
+
 func newSysEventListener(l raftio.ISystemEventListener,
-	stopc chan struct{}) *sysEventListener {
+	size uint64) *sysEventListener {
+	if size == 0 {
+		size = defaultSysEventQueueSize
+	}
 	return &sysEventListener{
-		stopc:  stopc,
-		events: make(chan server.SystemEvent),
-		ul:     l,
+		ul:       l,
+		notifier: newEventNotifier(false),
+		size:     int(size),
 	}
 }
 
@@ -160,17 +287,90 @@ func (l *sysEventListener) Publish(e server.SystemEvent) {
 	if l.ul == nil {
 		return
 	}
-	select {
-	case l.events <- e:
-	case <-l.stopc:
-		return
+	func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if len(l.events) >= l.size {
+			l.events = l.events[1:]
+			l.dropped++
+		}
+		l.events = append(l.events, e)
+	}()
+	// system events are not coalesced, they are rare and some of them, e.g.
+	// NodeHostShuttingDown, are not followed by any engine iteration
+	l.notifier.signal()
+}
+
+func (l *sysEventListener) workReady() chan struct{} {
+	return l.notifier.workReady()
+}
+
+func (l *sysEventListener) getEvent() (server.SystemEvent, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) > 0 {
+		e := l.events[0]
+		l.events = l.events[1:]
+		return e, true
 	}
+	return server.SystemEvent{}, false
+}
+
+// Dropped returns the total number of dropped events.
+func (l *sysEventListener) Dropped() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dropped
+}
+
+// Pending returns the number of queued events.
+func (l *sysEventListener) Pending() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return uint64(len(l.events))
+}
+
+// invoke invokes the specified user listener callback, a panic from the
+// callback is recovered, logged and published as a ListenerPanicked event.
+func (l *sysEventListener) invoke(listener string,
+	shardID uint64, replicaID uint64, f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			plog.Errorf("%s panicked when handling event of %s, %v",
+				listener, dn(shardID, replicaID), r)
+			l.Publish(server.SystemEvent{
+				Type:      server.ListenerPanicked,
+				Listener:  listener,
+				Reason:    fmt.Sprint(r),
+				ShardID:   shardID,
+				ReplicaID: replicaID,
+			})
+		}
+	}()
+	f()
 }
 
 func (l *sysEventListener) handle(e server.SystemEvent) {
 	if l.ul == nil {
 		return
 	}
+	if e.Type == server.ListenerPanicked {
+		// not to report panics from ListenerPanicked itself again
+		defer func() {
+			if r := recover(); r != nil {
+				plog.Errorf("ISystemEventListener panicked when handling "+
+					"ListenerPanicked event, %v", r)
+			}
+		}()
+		l.ul.ListenerPanicked(getListenerPanicInfo(e))
+		return
+	}
+	l.invoke("ISystemEventListener", e.ShardID, e.ReplicaID, func() {
+		l.dispatch(e)
+	})
+}
+
+func (l *sysEventListener) dispatch(e server.SystemEvent) {
 	switch e.Type {
 	case server.NodeHostShuttingDown:
 		l.ul.NodeHostShuttingDown()
@@ -186,12 +386,22 @@ func (l *sysEventListener) handle(e server.SystemEvent) {
 		l.ul.ConnectionEstablished(getConnectionInfo(e))
 	case server.ConnectionFailed:
 		l.ul.ConnectionFailed(getConnectionInfo(e))
+	case server.ConnectionRejected:
+		l.ul.ConnectionRejected(getConnectionInfo(e))
+	case server.MisdeliveredMessage:
+		l.ul.MisdeliveredMessage(getMisdeliveredMessageInfo(e))
 	case server.SendSnapshotStarted:
 		l.ul.SendSnapshotStarted(getSnapshotInfo(e))
 	case server.SendSnapshotCompleted:
 		l.ul.SendSnapshotCompleted(getSnapshotInfo(e))
 	case server.SendSnapshotAborted:
 		l.ul.SendSnapshotAborted(getSnapshotInfo(e))
+	case server.SnapshotReceiveStarted:
+		l.ul.SnapshotReceiveStarted(getSnapshotInfo(e))
+	case server.SnapshotReceiveProgress:
+		l.ul.SnapshotReceiveProgress(getSnapshotProgressInfo(e))
+	case server.SnapshotReceiveAborted:
+		l.ul.SnapshotReceiveAborted(getSnapshotAbortInfo(e))
 	case server.SnapshotReceived:
 		l.ul.SnapshotReceived(getSnapshotInfo(e))
 	case server.SnapshotRecovered:
@@ -204,6 +414,56 @@ func (l *sysEventListener) handle(e server.SystemEvent) {
 		l.ul.LogCompacted(getEntryInfo(e))
 	case server.LogDBCompacted:
 		l.ul.LogDBCompacted(getEntryInfo(e))
+	case server.StagedPromotionTimeout:
+		l.ul.StagedPromotionTimeout(getStagedPromotionInfo(e))
+	case server.NonVotingLagging:
+		l.ul.NonVotingLagging(getNonVotingLagInfo(e))
+	case server.NonVotingLagRecovered:
+		l.ul.NonVotingLagRecovered(getNonVotingLagInfo(e))
+	case server.BootstrapMismatch:
+		l.ul.BootstrapMismatch(getBootstrapMismatchInfo(e))
+	case server.SlowStateMachine:
+		l.ul.SlowStateMachine(getSlowStateMachineInfo(e))
+	case server.SlowDisk:
+		l.ul.SlowDisk(getSlowDiskInfo(e))
+	case server.ApplyStalled:
+		l.ul.ApplyStalled(getApplyStallInfo(e))
+	case server.ApplyStallCleared:
+		l.ul.ApplyStallCleared(getApplyStallInfo(e))
+	case server.DiskSpaceLow:
+		l.ul.DiskSpaceLow(getDiskSpaceInfo(e))
+	case server.DiskSpaceCritical:
+		l.ul.DiskSpaceCritical(getDiskSpaceInfo(e))
+	case server.DiskSpaceRecovered:
+		l.ul.DiskSpaceRecovered(getDiskSpaceInfo(e))
+	case server.QuiesceEntered:
+		l.ul.QuiesceEntered(getQuiesceInfo(e))
+	case server.QuiesceExited:
+		l.ul.QuiesceExited(getQuiesceInfo(e))
+	case server.LogRetentionExceeded:
+		l.ul.LogRetentionExceeded(getLogRetentionInfo(e))
+	case server.SnapshotFingerprintMismatch:
+		l.ul.SnapshotFingerprintMismatch(getSnapshotFingerprintInfo(e))
+	case server.GossipIsolated:
+		l.ul.GossipIsolated(getGossipInfo(e))
+	case server.GossipRejoined:
+		l.ul.GossipRejoined(getGossipInfo(e))
+	case server.NodeHostSuspected:
+		l.ul.NodeHostSuspected(getNodeHostLivenessInfo(e))
+	case server.NodeHostRecovered:
+		l.ul.NodeHostRecovered(getNodeHostLivenessInfo(e))
+	case server.OrphanedDataPurged:
+		l.ul.OrphanedDataPurged(getOrphanPurgeInfo(e))
+	case server.StartupAuditFailed:
+		l.ul.StartupAuditFailed(getStartupAuditInfo(e))
+	case server.CampaignSuppressed:
+		l.ul.CampaignSuppressed(getCampaignSuppressedInfo(e))
+	case server.LeaderDegraded:
+		l.ul.LeaderDegraded(getLeaderDegradedInfo(e))
+	case server.NodeRemovedFromShard:
+		l.ul.NodeRemovedFromShard(getNodeRemovedInfo(e))
+	case server.EnginePanicked:
+		l.ul.EnginePanicked(getEnginePanicInfo(e))
 	default:
 		panic("unknown event type")
 	}
@@ -218,6 +478,27 @@ func getSnapshotInfo(e server.SystemEvent) raftio.SnapshotInfo {
 	}
 }
 
+func getSnapshotProgressInfo(e server.SystemEvent) raftio.SnapshotProgressInfo {
+	return raftio.SnapshotProgressInfo{
+		ShardID:       e.ShardID,
+		ReplicaID:     e.ReplicaID,
+		From:          e.From,
+		Index:         e.Index,
+		ReceivedBytes: e.ReceivedBytes,
+		TotalBytes:    e.TotalBytes,
+	}
+}
+
+func getSnapshotAbortInfo(e server.SystemEvent) raftio.SnapshotAbortInfo {
+	return raftio.SnapshotAbortInfo{
+		ShardID:   e.ShardID,
+		ReplicaID: e.ReplicaID,
+		From:      e.From,
+		Index:     e.Index,
+		Reason:    e.Reason,
+	}
+}
+
 func getNodeInfo(e server.SystemEvent) raftio.NodeInfo {
 	return raftio.NodeInfo{
 		ShardID:   e.ShardID,
@@ -233,9 +514,199 @@ func getEntryInfo(e server.SystemEvent) raftio.EntryInfo {
 	}
 }
 
+func getStagedPromotionInfo(e server.SystemEvent) raftio.StagedPromotionInfo {
+	return raftio.StagedPromotionInfo{
+		ShardID:   e.ShardID,
+		ReplicaID: e.ReplicaID,
+		Match:     e.Index,
+	}
+}
+
+func getNonVotingLagInfo(e server.SystemEvent) raftio.NonVotingLagInfo {
+	return raftio.NonVotingLagInfo{
+		ShardID:   e.ShardID,
+		ReplicaID: e.ReplicaID,
+		Match:     e.Index,
+		Lag:       e.Lag,
+	}
+}
+
+func getBootstrapMismatchInfo(
+	e server.SystemEvent) raftio.BootstrapMismatchInfo {
+	return raftio.BootstrapMismatchInfo{
+		ShardID:                 e.ShardID,
+		ReplicaID:               e.ReplicaID,
+		From:                    e.From,
+		LocalHash:               e.LocalHash,
+		RemoteHash:              e.RemoteHash,
+		LocalElectionTimeout:    e.Duration,
+		RemoteHeartbeatInterval: e.Interval,
+	}
+}
+
+func getSlowStateMachineInfo(e server.SystemEvent) raftio.SlowStateMachineInfo {
+	return raftio.SlowStateMachineInfo{
+		ShardID:   e.ShardID,
+		ReplicaID: e.ReplicaID,
+		Callback:  e.Callback,
+		Index:     e.Index,
+		Duration:  e.Duration,
+		RequestID: e.RequestID,
+	}
+}
+
+func getSlowDiskInfo(e server.SystemEvent) raftio.SlowDiskInfo {
+	return raftio.SlowDiskInfo{
+		ShardID:   e.ShardID,
+		ReplicaID: e.ReplicaID,
+		Duration:  e.Duration,
+	}
+}
+
+func getApplyStallInfo(e server.SystemEvent) raftio.ApplyStallInfo {
+	return raftio.ApplyStallInfo{
+		ShardID:   e.ShardID,
+		ReplicaID: e.ReplicaID,
+		Index:     e.Index,
+		Lag:       e.Lag,
+		Duration:  e.Duration,
+	}
+}
+
+func getDiskSpaceInfo(e server.SystemEvent) raftio.DiskSpaceInfo {
+	return raftio.DiskSpaceInfo{
+		Path:       e.Path,
+		ShardID:    e.ShardID,
+		AvailBytes: e.AvailBytes,
+		TotalBytes: e.TotalBytes,
+	}
+}
+
+func getQuiesceInfo(e server.SystemEvent) raftio.QuiesceInfo {
+	return raftio.QuiesceInfo{
+		ShardID:   e.ShardID,
+		ReplicaID: e.ReplicaID,
+		Ticks:     e.Ticks,
+	}
+}
+
+func getGossipInfo(e server.SystemEvent) raftio.GossipInfo {
+	return raftio.GossipInfo{
+		AdvertiseAddress: e.Address,
+		Members:          e.Members,
+	}
+}
+
+func getNodeHostLivenessInfo(e server.SystemEvent) raftio.NodeHostLivenessInfo {
+	return raftio.NodeHostLivenessInfo{
+		NodeHostID:  e.NodeHostID,
+		RaftAddress: e.Address,
+	}
+}
+
+func getOrphanPurgeInfo(e server.SystemEvent) raftio.OrphanPurgeInfo {
+	return raftio.OrphanPurgeInfo{
+		ShardID:   e.ShardID,
+		ReplicaID: e.ReplicaID,
+		Path:      e.Path,
+		Bytes:     e.TotalBytes,
+		Completed: e.Completed,
+		Total:     e.Total,
+	}
+}
+
+func getStartupAuditInfo(e server.SystemEvent) raftio.StartupAuditInfo {
+	return raftio.StartupAuditInfo{
+		ShardID:    e.ShardID,
+		ReplicaID:  e.ReplicaID,
+		Violations: e.Total,
+		Repaired:   e.Completed,
+		Report:     e.Reason,
+	}
+}
+
+func getCampaignSuppressedInfo(
+	e server.SystemEvent) raftio.CampaignSuppressedInfo {
+	return raftio.CampaignSuppressedInfo{
+		ShardID:   e.ShardID,
+		ReplicaID: e.ReplicaID,
+		Term:      e.Term,
+	}
+}
+
+func getLeaderDegradedInfo(e server.SystemEvent) raftio.LeaderDegradedInfo {
+	return raftio.LeaderDegradedInfo{
+		ShardID:   e.ShardID,
+		ReplicaID: e.ReplicaID,
+		Operation: e.Callback,
+		Latency:   e.Duration,
+		Ticks:     e.Ticks,
+		Target:    e.Target,
+	}
+}
+
+func getNodeRemovedInfo(e server.SystemEvent) raftio.NodeRemovedInfo {
+	return raftio.NodeRemovedInfo{
+		ShardID:   e.ShardID,
+		ReplicaID: e.ReplicaID,
+		Index:     e.Index,
+	}
+}
+
+func getEnginePanicInfo(e server.SystemEvent) raftio.EnginePanicInfo {
+	return raftio.EnginePanicInfo{
+		ShardID:    e.ShardID,
+		ReplicaID:  e.ReplicaID,
+		Operation:  e.Operation,
+		FirstIndex: e.FirstIndex,
+		LastIndex:  e.LastIndex,
+		Panic:      e.Reason,
+	}
+}
+
+func getLogRetentionInfo(e server.SystemEvent) raftio.LogRetentionInfo {
+	return raftio.LogRetentionInfo{
+		ShardID:       e.ShardID,
+		ReplicaID:     e.ReplicaID,
+		FirstIndex:    e.FirstIndex,
+		LastIndex:     e.LastIndex,
+		SnapshotIndex: e.Index,
+		Reason:        e.Reason,
+	}
+}
+
+func getSnapshotFingerprintInfo(
+	e server.SystemEvent) raftio.SnapshotFingerprintInfo {
+	return raftio.SnapshotFingerprintInfo{
+		ShardID:   e.ShardID,
+		ReplicaID: e.ReplicaID,
+		Index:     e.Index,
+		Recorded:  e.RemoteHash,
+		Computed:  e.LocalHash,
+	}
+}
+
+func getListenerPanicInfo(e server.SystemEvent) raftio.ListenerPanicInfo {
+	return raftio.ListenerPanicInfo{
+		Listener:  e.Listener,
+		Panic:     e.Reason,
+		ShardID:   e.ShardID,
+		ReplicaID: e.ReplicaID,
+	}
+}
+
 func getConnectionInfo(e server.SystemEvent) raftio.ConnectionInfo {
 	return raftio.ConnectionInfo{
 		Address:            e.Address,
 		SnapshotConnection: e.SnapshotConnection,
 	}
 }
+
+func getMisdeliveredMessageInfo(
+	e server.SystemEvent) raftio.MisdeliveredMessageInfo {
+	return raftio.MisdeliveredMessageInfo{
+		Address:   e.Address,
+		ShardID:   e.ShardID,
+		ReplicaID: e.ReplicaID,
+	}
+}
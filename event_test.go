@@ -0,0 +1,263 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+)
+
+type blockingSysEventListener struct {
+	*testSysEventListener
+	blockedC  chan struct{}
+	unblockC  chan struct{}
+	blockOnce sync.Once
+}
+
+func (l *blockingSysEventListener) NodeReady(info raftio.NodeInfo) {
+	l.blockOnce.Do(func() { close(l.blockedC) })
+	<-l.unblockC
+	l.testSysEventListener.NodeReady(info)
+}
+
+type panickingSysEventListener struct {
+	*testSysEventListener
+}
+
+func (l *panickingSysEventListener) NodeReady(info raftio.NodeInfo) {
+	panic("NodeReady failed")
+}
+
+func (l *panickingSysEventListener) SnapshotCreated(info raftio.SnapshotInfo) {
+	panic("SnapshotCreated failed")
+}
+
+func TestSysEventQueueDropsOldestEvents(t *testing.T) {
+	l := newSysEventListener(&testSysEventListener{}, 3)
+	for i := uint64(1); i <= 5; i++ {
+		l.Publish(server.SystemEvent{Type: server.LogCompacted, Index: i})
+	}
+	if l.Dropped() != 2 || l.Pending() != 3 {
+		t.Fatalf("dropped %d, pending %d", l.Dropped(), l.Pending())
+	}
+	for i := uint64(3); i <= 5; i++ {
+		e, ok := l.getEvent()
+		if !ok || e.Index != i {
+			t.Fatalf("unexpected event %+v, want index %d", e, i)
+		}
+	}
+	if _, ok := l.getEvent(); ok {
+		t.Errorf("unexpected event")
+	}
+}
+
+func TestSysEventsAreNotQueuedWithoutListener(t *testing.T) {
+	l := newSysEventListener(nil, 0)
+	l.Publish(server.SystemEvent{Type: server.LogCompacted})
+	if l.Pending() != 0 {
+		t.Errorf("event unexpectedly queued")
+	}
+}
+
+func TestListenerPanicIsRecovered(t *testing.T) {
+	ul := &panickingSysEventListener{&testSysEventListener{}}
+	l := newSysEventListener(ul, 0)
+	l.handle(server.SystemEvent{Type: server.NodeReady, ShardID: 1, ReplicaID: 2})
+	e, ok := l.getEvent()
+	if !ok || e.Type != server.ListenerPanicked {
+		t.Fatalf("ListenerPanicked event not published, %+v", e)
+	}
+	l.handle(e)
+	panicked := ul.getListenerPanicked()
+	if len(panicked) != 1 || panicked[0].Listener != "ISystemEventListener" ||
+		panicked[0].Panic != "NodeReady failed" ||
+		panicked[0].ShardID != 1 || panicked[0].ReplicaID != 2 {
+		t.Errorf("unexpected ListenerPanicked events %+v", panicked)
+	}
+	// the listener keeps receiving events
+	l.handle(server.SystemEvent{Type: server.LogCompacted, ShardID: 1})
+	if len(ul.getLogCompacted()) != 1 {
+		t.Errorf("event not delivered after panic")
+	}
+	if l.Pending() != 0 {
+		t.Errorf("unexpected pending events")
+	}
+}
+
+func TestBlockingSystemEventListenerDoesNotBlockEngine(t *testing.T) {
+	fs := vfs.GetTestFS()
+	listener := &blockingSysEventListener{
+		testSysEventListener: &testSysEventListener{},
+		blockedC:             make(chan struct{}),
+		unblockC:             make(chan struct{}),
+	}
+	var unblockOnce sync.Once
+	unblock := func() { unblockOnce.Do(func() { close(listener.unblockC) }) }
+	to := &testOption{
+		defaultTestNode: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.SystemEventListener = listener
+			c.SystemEventQueueSize = 4
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			defer unblock()
+			select {
+			case <-listener.blockedC:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("listener not invoked")
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			for i := 0; i < 8; i++ {
+				makeProposals(nh)
+				if _, err := nh.SyncRequestSnapshot(ctx, 1, SnapshotOption{}); err != nil {
+					t.Fatalf("failed to request snapshot, %v", err)
+				}
+			}
+			stats := nh.GetEventQueueStats()
+			if stats.Dropped() == 0 || stats.Pending() != 4 {
+				t.Errorf("dropped %d, pending %d", stats.Dropped(), stats.Pending())
+			}
+			unblock()
+			for i := 0; i < 500 && stats.Pending() > 0; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if stats.Pending() != 0 {
+				t.Fatalf("queued events not delivered")
+			}
+			// the most recent events are kept
+			if len(listener.getSnapshotCreated()) == 0 {
+				t.Errorf("SnapshotCreated events not delivered")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestPanickingSystemEventListenerIsReported(t *testing.T) {
+	fs := vfs.GetTestFS()
+	listener := &panickingSysEventListener{&testSysEventListener{}}
+	to := &testOption{
+		defaultTestNode: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.SystemEventListener = listener
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			if _, err := nh.SyncRequestSnapshot(ctx, 1, SnapshotOption{}); err != nil {
+				t.Fatalf("failed to request snapshot, %v", err)
+			}
+			var panicked []raftio.ListenerPanicInfo
+			for i := 0; i < 500; i++ {
+				if panicked = listener.getListenerPanicked(); len(panicked) >= 2 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if len(panicked) < 2 {
+				t.Fatalf("unexpected ListenerPanicked events %+v", panicked)
+			}
+			found := false
+			for _, p := range panicked {
+				if p.Panic == "SnapshotCreated failed" && p.ShardID == 1 {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("SnapshotCreated panic not reported, %+v", panicked)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestEventNotifierCoalescesNotifications(t *testing.T) {
+	n := newEventNotifier(true)
+	n.notify()
+	n.notify()
+	if len(n.workReady()) != 0 {
+		t.Fatalf("dispatcher woken up before flush")
+	}
+	n.flush()
+	n.flush()
+	if len(n.workReady()) != 1 {
+		t.Fatalf("dispatcher not woken up")
+	}
+	<-n.workReady()
+	n.flush()
+	if len(n.workReady()) != 0 {
+		t.Errorf("unexpected wakeup")
+	}
+	var nilNotifier *eventNotifier
+	nilNotifier.flush()
+}
+
+func TestCoalescedEventsAreNotLostOrReordered(t *testing.T) {
+	n := newEventNotifier(true)
+	lq := newLeaderInfoQueue()
+	lq.notifier = n
+	mq := newMembershipChangeQueue()
+	mq.notifier = n
+	for term := uint64(1); term <= 3; term++ {
+		for shardID := uint64(1); shardID <= 4; shardID++ {
+			lq.addLeaderInfo(raftio.LeaderInfo{ShardID: shardID, Term: term})
+			mq.addMembershipChange(raftio.MembershipChangeInfo{
+				ShardID: shardID, Index: term,
+			})
+		}
+	}
+	n.flush()
+	if len(n.workReady()) != 1 {
+		t.Fatalf("dispatcher not woken up")
+	}
+	terms := make(map[uint64]uint64)
+	for {
+		v, ok := lq.getLeaderInfo()
+		if !ok {
+			break
+		}
+		if v.Term != terms[v.ShardID]+1 {
+			t.Errorf("shard %d, term %d, want %d", v.ShardID, v.Term, terms[v.ShardID]+1)
+		}
+		terms[v.ShardID] = v.Term
+	}
+	indexes := make(map[uint64]uint64)
+	for {
+		v, ok := mq.getMembershipChange()
+		if !ok {
+			break
+		}
+		if v.Index != indexes[v.ShardID]+1 {
+			t.Errorf("shard %d, index %d, want %d",
+				v.ShardID, v.Index, indexes[v.ShardID]+1)
+		}
+		indexes[v.ShardID] = v.Index
+	}
+	for shardID := uint64(1); shardID <= 4; shardID++ {
+		if terms[shardID] != 3 || indexes[shardID] != 3 {
+			t.Errorf("shard %d, events lost", shardID)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"path"
+	"path/filepath"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/importer"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// ExportSink is the destination of an exported snapshot, it allows exported
+// snapshots to be directly written to places such as object stores. Files are
+// created using their slash separated paths relative to the export directory,
+// the layout and the content of the final metadata file are the same as those
+// of snapshots exported to SnapshotOption.ExportPath. To import such a
+// snapshot, its snapshot-XXXXXXXXXXXXXXXX directory should be downloaded
+// and passed to the ImportSnapshot function in the tools package, or its files
+// can be provided by a SnapshotSource to NodeHost.ImportSnapshot. See
+// NewArchiveExportSink for exporting the snapshot as a single archive.
+//
+// Methods of the ExportSink are invoked from a snapshot worker goroutine, an
+// ExportSink instance is used by a single snapshot request.
+type ExportSink interface {
+	// CreateFile creates the named file. The snapshot image, external files and
+	// finally the metadata file are written in order, each file is closed
+	// before the next one is created.
+	CreateFile(name string) (io.WriteCloser, error)
+	// Commit is invoked with the metadata of the snapshot once all files have
+	// been written and closed. The exported snapshot is expected to be made
+	// visible atomically by Commit.
+	Commit(meta pb.Snapshot) error
+	// Abort is invoked when the export fails, including when Commit returns an
+	// error. Files already created should be discarded. The snapshot request is
+	// completed as aborted in such case.
+	Abort()
+}
+
+// dirExportSink is an ExportSink that writes exported snapshots to a local
+// directory. Files are written to a temporary directory first, the exported
+// snapshot directory is renamed into place on Commit.
+type dirExportSink struct {
+	fs  vfs.IFS
+	dir string
+	tmp string
+}
+
+var _ ExportSink = (*dirExportSink)(nil)
+
+// NewDirExportSink returns an ExportSink that writes the exported snapshot to
+// the specified existing directory, it is equivalent to setting
+// SnapshotOption.ExportPath. The default filesystem is used when fs is nil.
+func NewDirExportSink(dir string, fs config.IFS) ExportSink {
+	if fs == nil {
+		fs = vfs.DefaultFS
+	}
+	return &dirExportSink{dir: dir, fs: fs}
+}
+
+// CreateFile creates the named file in the temporary directory.
+func (s *dirExportSink) CreateFile(name string) (io.WriteCloser, error) {
+	fn := filepath.FromSlash(name)
+	if !filepath.IsLocal(fn) {
+		return nil, errors.Newf("invalid export filename %s", name)
+	}
+	if len(s.tmp) == 0 {
+		tmp, err := fileutil.TempDir(s.dir, "export", s.fs)
+		if err != nil {
+			return nil, err
+		}
+		s.tmp = tmp
+	}
+	fp := s.fs.PathJoin(s.tmp, fn)
+	if err := fileutil.MkdirAll(s.fs.PathDir(fp), s.fs); err != nil {
+		return nil, err
+	}
+	f, err := s.fs.Create(fp)
+	if err != nil {
+		return nil, err
+	}
+	return &syncedFile{File: f}, nil
+}
+
+// Commit moves exported files from the temporary directory to the export
+// directory.
+func (s *dirExportSink) Commit(meta pb.Snapshot) error {
+	if len(s.tmp) == 0 {
+		return errors.New("no file exported")
+	}
+	names, err := s.fs.List(s.tmp)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fp := s.fs.PathJoin(s.dir, name)
+		exist, err := fileutil.Exist(fp, s.fs)
+		if err != nil {
+			return err
+		}
+		if exist {
+			return errors.Newf("%s already exists", fp)
+		}
+		if err := s.fs.Rename(s.fs.PathJoin(s.tmp, name), fp); err != nil {
+			return err
+		}
+	}
+	if err := s.fs.RemoveAll(s.tmp); err != nil {
+		return err
+	}
+	s.tmp = ""
+	return fileutil.SyncDir(s.dir, s.fs)
+}
+
+// Abort removes the temporary directory.
+func (s *dirExportSink) Abort() {
+	if len(s.tmp) == 0 {
+		return
+	}
+	if err := s.fs.RemoveAll(s.tmp); err != nil {
+		plog.Errorf("failed to remove %s, %v", s.tmp, err)
+	}
+	s.tmp = ""
+}
+
+// archiveExportSink is an ExportSink that writes the exported snapshot to an
+// io.Writer as a single snapshot archive. The archive starts with a manifest
+// containing the snapshot metadata, which is only known once all files have
+// been written, files are thus spooled to a local temporary directory first
+// and the archive is streamed to the writer on Commit.
+type archiveExportSink struct {
+	spool    *dirExportSink
+	w        io.Writer
+	files    []importer.ManifestFile
+	metadata []byte
+}
+
+var _ ExportSink = (*archiveExportSink)(nil)
+
+// NewArchiveExportSink returns an ExportSink that writes the exported snapshot
+// to w as a single tar archive. The first entry of the archive is a manifest
+// containing the format version, the snapshot metadata and the SHA-256
+// digests of all files, it is followed by the snapshot image and external
+// files. w is written sequentially and is never seeked, it can be a pipe or
+// an upload stream to an object store, the total size of the archive is not
+// known in advance.
+//
+// Exported files are spooled to a temporary directory created in the specified
+// existing spoolDir before the archive is written to w on Commit, the
+// temporary directory is always removed once the export completes. Content
+// already written to w should be discarded when the snapshot request fails.
+// The default filesystem is used when fs is nil. The archive can be imported
+// using NewArchiveSnapshotSource or the ImportSnapshotArchive function in the
+// tools package.
+func NewArchiveExportSink(w io.Writer,
+	spoolDir string, fs config.IFS) ExportSink {
+	if fs == nil {
+		fs = vfs.DefaultFS
+	}
+	return &archiveExportSink{
+		spool: &dirExportSink{dir: spoolDir, fs: fs},
+		w:     w,
+	}
+}
+
+// CreateFile creates the named file in the spool directory. The content of
+// the metadata file is kept in memory as it is stored in the manifest.
+func (s *archiveExportSink) CreateFile(name string) (io.WriteCloser, error) {
+	if path.Base(name) == server.MetadataFilename {
+		return &metadataFile{sink: s}, nil
+	}
+	f, err := s.spool.CreateFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &spooledFile{WriteCloser: f, sink: s, name: name, h: sha256.New()}, nil
+}
+
+// Commit writes the snapshot archive to the writer.
+func (s *archiveExportSink) Commit(meta pb.Snapshot) error {
+	if len(s.spool.tmp) == 0 || len(s.metadata) == 0 {
+		return errors.New("no file exported")
+	}
+	m := importer.Manifest{
+		ShardID:  meta.ShardID,
+		Index:    meta.Index,
+		Term:     meta.Term,
+		Metadata: s.metadata,
+		Files:    s.files,
+	}
+	src := importer.NewDirSource(s.spool.tmp, s.spool.fs)
+	if err := importer.WriteArchive(s.w, m, src); err != nil {
+		return err
+	}
+	// spooled files are no longer required
+	s.spool.Abort()
+	return nil
+}
+
+// Abort removes the spool directory.
+func (s *archiveExportSink) Abort() {
+	s.spool.Abort()
+}
+
+// spooledFile is a file spooled by the archiveExportSink, its size and digest
+// are recorded in the manifest once it is closed.
+type spooledFile struct {
+	io.WriteCloser
+	sink *archiveExportSink
+	name string
+	h    hash.Hash
+	sz   uint64
+}
+
+func (f *spooledFile) Write(data []byte) (int, error) {
+	n, err := f.WriteCloser.Write(data)
+	f.h.Write(data[:n])
+	f.sz += uint64(n)
+	return n, err
+}
+
+func (f *spooledFile) Close() error {
+	if err := f.WriteCloser.Close(); err != nil {
+		return err
+	}
+	f.sink.files = append(f.sink.files, importer.ManifestFile{
+		Name:   f.name,
+		Size:   f.sz,
+		SHA256: hex.EncodeToString(f.h.Sum(nil)),
+	})
+	return nil
+}
+
+// metadataFile is the metadata file written to the archiveExportSink.
+type metadataFile struct {
+	bytes.Buffer
+	sink *archiveExportSink
+}
+
+func (f *metadataFile) Close() error {
+	f.sink.metadata = f.Bytes()
+	return nil
+}
+
+// syncedFile is a vfs.File synced before it is closed.
+type syncedFile struct {
+	vfs.File
+}
+
+func (f *syncedFile) Close() error {
+	return firstError(f.File.Sync(), f.File.Close())
+}
@@ -0,0 +1,339 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	"github.com/lni/dragonboat/v4/tools"
+)
+
+type memObject struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (o *memObject) Close() error {
+	o.closed = true
+	return nil
+}
+
+// memExportSink is an ExportSink similar to an object store, objects are only
+// visible once committed.
+type memExportSink struct {
+	pending   map[string]*memObject
+	committed map[string][]byte
+	failOn    string
+	meta      pb.Snapshot
+	aborted   bool
+}
+
+func newMemExportSink() *memExportSink {
+	return &memExportSink{
+		pending:   make(map[string]*memObject),
+		committed: make(map[string][]byte),
+	}
+}
+
+func (s *memExportSink) CreateFile(name string) (io.WriteCloser, error) {
+	if name == s.failOn {
+		return nil, errors.New("failed to create object")
+	}
+	o := &memObject{}
+	s.pending[name] = o
+	return o, nil
+}
+
+func (s *memExportSink) Commit(meta pb.Snapshot) error {
+	for name, o := range s.pending {
+		if !o.closed {
+			return errors.Newf("%s not closed", name)
+		}
+		s.committed[name] = o.Bytes()
+	}
+	s.pending = make(map[string]*memObject)
+	s.meta = meta
+	return nil
+}
+
+func (s *memExportSink) Abort() {
+	s.pending = make(map[string]*memObject)
+	s.aborted = true
+}
+
+func (s *memExportSink) names() []string {
+	var result []string
+	for name := range s.committed {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func exportTestSnapshot(nh *NodeHost, sink ExportSink) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+	defer cancel()
+	opt := SnapshotOption{Exported: true, ExportSink: sink}
+	return nh.SyncRequestSnapshot(ctx, 1, opt)
+}
+
+func TestSnapshotExportedToSinkCanBeImported(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			proposeTestData(t, nh, "exported", 5)
+			sink := newMemExportSink()
+			index, err := exportTestSnapshot(nh, sink)
+			if err != nil {
+				t.Fatalf("failed to export snapshot %v", err)
+			}
+			dir := server.GetSnapshotDirName(index)
+			want := []string{
+				fmt.Sprintf("%s/%s", dir, server.GetSnapshotFilename(index)),
+				fmt.Sprintf("%s/%s", dir, server.MetadataFilename),
+			}
+			sort.Strings(want)
+			if names := sink.names(); fmt.Sprint(names) != fmt.Sprint(want) {
+				t.Fatalf("unexpected objects %v, want %v", names, want)
+			}
+			if sink.aborted || sink.meta.Index != index {
+				t.Fatalf("unexpected sink state, %+v", sink)
+			}
+			// download the objects and import the snapshot
+			nhc := nh.NodeHostConfig()
+			downloaded := fs.PathJoin(nhc.NodeHostDir, "downloaded")
+			for name, data := range sink.committed {
+				fp := fs.PathJoin(downloaded, name)
+				if err := fs.MkdirAll(fs.PathDir(fp), 0755); err != nil {
+					t.Fatalf("%v", err)
+				}
+				f, err := fs.Create(fp)
+				if err != nil {
+					t.Fatalf("%v", err)
+				}
+				if _, err := f.Write(data); err != nil {
+					t.Fatalf("%v", err)
+				}
+				if err := f.Close(); err != nil {
+					t.Fatalf("%v", err)
+				}
+			}
+			nhc = config.NodeHostConfig{
+				NodeHostDir:    fs.PathJoin(nhc.NodeHostDir, "imported"),
+				RTTMillisecond: nhc.RTTMillisecond,
+				RaftAddress:    nhc.RaftAddress,
+				Expert:         getTestExpertConfig(fs),
+			}
+			members := map[uint64]string{1: nhc.RaftAddress}
+			if err := tools.ImportSnapshot(nhc,
+				fs.PathJoin(downloaded, dir), members, 1); err != nil {
+				t.Fatalf("failed to import snapshot %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestFailedExportToSinkIsAborted(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			proposeTestData(t, nh, "exported", 5)
+			n, ok := nh.getShard(1)
+			if !ok {
+				t.Fatalf("failed to get node")
+			}
+			index := n.sm.GetLastApplied()
+			sink := newMemExportSink()
+			sink.failOn = fmt.Sprintf("%s/%s",
+				server.GetSnapshotDirName(index), server.MetadataFilename)
+			if _, err := exportTestSnapshot(nh, sink); !errors.Is(err, ErrAborted) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !sink.aborted || len(sink.committed) > 0 || len(sink.pending) > 0 {
+				t.Errorf("export not aborted, %+v", sink)
+			}
+			// the replica is still available
+			proposeTestData(t, nh, "more", 1)
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+type failedCommitSink struct {
+	ExportSink
+}
+
+func (s *failedCommitSink) Commit(pb.Snapshot) error {
+	return errors.New("failed to commit")
+}
+
+func TestDirExportSink(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			proposeTestData(t, nh, "exported", 5)
+			dir := fs.PathJoin(nh.NodeHostConfig().NodeHostDir, "exported")
+			if err := fs.MkdirAll(dir, 0755); err != nil {
+				t.Fatalf("%v", err)
+			}
+			sink := &failedCommitSink{NewDirExportSink(dir, fs)}
+			if _, err := exportTestSnapshot(nh, sink); !errors.Is(err, ErrAborted) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if names, err := fs.List(dir); err != nil || len(names) != 0 {
+				t.Fatalf("partial state not removed, %v, %v", names, err)
+			}
+			index, err := exportTestSnapshot(nh, NewDirExportSink(dir, fs))
+			if err != nil {
+				t.Fatalf("failed to export snapshot %v", err)
+			}
+			ssDir := fs.PathJoin(dir, server.GetSnapshotDirName(index))
+			names, err := fs.List(ssDir)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			sort.Strings(names)
+			want := []string{server.GetSnapshotFilename(index),
+				server.MetadataFilename}
+			sort.Strings(want)
+			if fmt.Sprint(names) != fmt.Sprint(want) {
+				t.Errorf("unexpected files %v, want %v", names, want)
+			}
+			if names, _ := fs.List(dir); len(names) != 1 {
+				t.Errorf("unexpected files %v", names)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestExportSinkRequiresExportedSnapshot(t *testing.T) {
+	sink := newMemExportSink()
+	invalid := []SnapshotOption{
+		{ExportSink: sink},
+		{ExportSink: sink, Exported: true, ExportPath: "exported"},
+	}
+	for idx, opt := range invalid {
+		if err := opt.Validate(); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("%d, unexpected error %v", idx, err)
+		}
+	}
+	opt := SnapshotOption{ExportSink: sink, Exported: true}
+	if err := opt.Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestArchiveExportIsEquivalentToDirExport(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		nh := nhs[0]
+		members := map[uint64]string{1: memtransport.Address(1)}
+		startCloneTestShard(t, nhs, 1, []uint64{1}, members)
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(nh))
+		defer cancel()
+		for _, cmd := range []string{"a=1", "b=2"} {
+			if _, err := nh.SyncPropose(ctx,
+				nh.GetNoOPSession(1), []byte(cmd)); err != nil {
+				t.Fatalf("failed to propose %v", err)
+			}
+		}
+		nhDir := nh.NodeHostConfig().NodeHostDir
+		dir := fs.PathJoin(nhDir, "exported")
+		spool := fs.PathJoin(nhDir, "spool")
+		for _, d := range []string{dir, spool} {
+			if err := fs.MkdirAll(d, 0755); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+		index, err := exportTestSnapshot(nh, NewDirExportSink(dir, fs))
+		if err != nil {
+			t.Fatalf("failed to export snapshot %v", err)
+		}
+		archive := bytes.NewBuffer(nil)
+		if _, err := exportTestSnapshot(nh,
+			NewArchiveExportSink(archive, spool, fs)); err != nil {
+			t.Fatalf("failed to export snapshot %v", err)
+		}
+		if names, err := fs.List(spool); err != nil || len(names) != 0 {
+			t.Errorf("spooled files not removed, %v, %v", names, err)
+		}
+		data := archive.Bytes()
+		// the manifest content follows the 512 bytes tar header
+		corrupted := append([]byte{}, data...)
+		corrupted[512+16]++
+		if _, err := NewArchiveSnapshotSource(
+			bytes.NewReader(corrupted)); !errors.Is(err, ErrInvalidSnapshotArchive) {
+			t.Errorf("unexpected error %v", err)
+		}
+		asrc, err := NewArchiveSnapshotSource(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("failed to read archive %v", err)
+		}
+		sources := []SnapshotSource{
+			NewDirSnapshotSource(fs.PathJoin(dir,
+				server.GetSnapshotDirName(index)), fs),
+			asrc,
+		}
+		opt := ImportOption{Clone: true}
+		for i, src := range sources {
+			shardID := uint64(i + 2)
+			if err := nh.ImportSnapshotWithOption(ctx,
+				shardID, 1, src, members, opt); err != nil {
+				t.Fatalf("failed to import snapshot %v", err)
+			}
+			startCloneTestShard(t, nhs, shardID, []uint64{1}, nil)
+			for key, want := range map[string]string{"a": "1", "b": "2"} {
+				if v := readCloneTestValue(t, nh, shardID, key); v != want {
+					t.Errorf("shard %d, key %s, value %s, want %s",
+						shardID, key, v, want)
+				}
+			}
+		}
+		// the offline import
+		nhc := config.NodeHostConfig{
+			NodeHostDir:    fs.PathJoin(nhDir, "imported"),
+			RTTMillisecond: nh.NodeHostConfig().RTTMillisecond,
+			RaftAddress:    memtransport.Address(1),
+			Expert:         getTestExpertConfig(fs),
+		}
+		if err := tools.ImportSnapshotArchive(nhc, bytes.NewReader(corrupted),
+			members, 1, tools.ImportOption{}); !errors.Is(err,
+			tools.ErrInvalidSnapshotArchive) {
+			t.Errorf("unexpected error %v", err)
+		}
+		if err := tools.ImportSnapshotArchive(nhc, bytes.NewReader(data),
+			members, 1, tools.ImportOption{}); err != nil {
+			t.Errorf("failed to import snapshot %v", err)
+		}
+	}
+	memTransportNodeHostTest(t, 1, tf, fs)
+}
@@ -0,0 +1,94 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/errors"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	// lastExportFilename is the name of the file in the snapshot directory of
+	// the replica recording the last successfully exported snapshot.
+	lastExportFilename    = "last-export"
+	lastExportTmpFilename = "last-export.tmp"
+)
+
+var (
+	// ErrSnapshotUnchanged indicates that the requested export was skipped as
+	// the state machine has not changed since the last exported snapshot. The
+	// returned error is a *SnapshotUnchangedError.
+	ErrSnapshotUnchanged = errors.New("snapshot unchanged since last export")
+)
+
+// SnapshotUnchangedError is the error returned when an export requested with
+// SnapshotOption.SkipIfUnchanged is skipped. Index is the index of the last
+// exported snapshot, which is still identical to the current state.
+type SnapshotUnchangedError struct {
+	ShardID uint64
+	Index   uint64
+}
+
+func (e *SnapshotUnchangedError) Error() string {
+	return fmt.Sprintf("%s, shard %d, index %d",
+		ErrSnapshotUnchanged, e.ShardID, e.Index)
+}
+
+// Unwrap returns ErrSnapshotUnchanged.
+func (e *SnapshotUnchangedError) Unwrap() error {
+	return ErrSnapshotUnchanged
+}
+
+// getLastExportIndex returns the index of the last exported snapshot of the
+// replica, 0 is returned when there is no such snapshot.
+func (n *node) getLastExportIndex() (uint64, error) {
+	ss, err := n.snapshotter.getLastExport()
+	if err != nil {
+		return 0, err
+	}
+	return ss.Index, nil
+}
+
+// checkExportUnchanged returns a *SnapshotUnchangedError when the state
+// machine has not changed since the last exported snapshot. Membership
+// changes are applied as raft entries so they advance the applied index, the
+// config change ID is still compared in case the applied index went back
+// after the replica was repaired from an imported snapshot.
+func (n *node) checkExportUnchanged() error {
+	last, err := n.snapshotter.getLastExport()
+	if err != nil {
+		return err
+	}
+	if last.Index == 0 || n.sm.GetLastApplied() != last.Index {
+		return nil
+	}
+	if n.sm.GetMembership().ConfigChangeId != last.Membership.ConfigChangeId {
+		return nil
+	}
+	return &SnapshotUnchangedError{ShardID: n.shardID, Index: last.Index}
+}
+
+// recordExport records the exported snapshot so later exports requested with
+// SkipIfUnchanged can be skipped. Failing to record it is not fatal, it only
+// means that the next export is not skipped.
+func (n *node) recordExport(ss pb.Snapshot) {
+	if err := n.snapshotter.saveLastExport(ss); err != nil {
+		plog.Warningf("%s failed to record exported snapshot %d, %v",
+			n.id(), ss.Index, err)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// saveCountingSM is a state machine counting its SaveSnapshot invocations.
+type saveCountingSM struct {
+	snapshotWriteTestSM
+	saves *uint64
+}
+
+func (s *saveCountingSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	atomic.AddUint64(s.saves, 1)
+	return s.snapshotWriteTestSM.SaveSnapshot(w, fc, done)
+}
+
+func exportIfChanged(nh *NodeHost, dir string) (ExportResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+	defer cancel()
+	opt := SnapshotOption{ExportPath: dir, SkipIfUnchanged: true}
+	return nh.SyncExportSnapshot(ctx, 1, opt)
+}
+
+func TestSkipIfUnchangedRequiresExported(t *testing.T) {
+	opt := SnapshotOption{SkipIfUnchanged: true}
+	if err := opt.Validate(); err != ErrInvalidOption {
+		t.Errorf("unexpected error %v", err)
+	}
+	opt.Exported = true
+	if err := opt.Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestUnchangedSnapshotIsNotExported(t *testing.T) {
+	fs := vfs.GetTestFS()
+	saves := uint64(0)
+	to := &testOption{
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &saveCountingSM{
+				snapshotWriteTestSM: snapshotWriteTestSM{size: 1024},
+				saves:               &saves,
+			}
+		},
+		tf: func(nh *NodeHost) {
+			makeProposals(nh)
+			dir := getLeaderSnapshotExportDir(t, fs, nh)
+			first, err := exportIfChanged(nh, dir)
+			if err != nil {
+				t.Fatalf("failed to export %v", err)
+			}
+			if first.PreviousIndex != 0 {
+				t.Errorf("unexpected previous index %d", first.PreviousIndex)
+			}
+			// idle shard
+			count := atomic.LoadUint64(&saves)
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			opt := SnapshotOption{
+				Exported:        true,
+				ExportPath:      dir,
+				SkipIfUnchanged: true,
+			}
+			_, err = nh.SyncRequestSnapshot(ctx, 1, opt)
+			var sue *SnapshotUnchangedError
+			if !errors.As(err, &sue) || !errors.Is(err, ErrSnapshotUnchanged) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if sue.Index != first.Index {
+				t.Errorf("index %d, want %d", sue.Index, first.Index)
+			}
+			if v := atomic.LoadUint64(&saves); v != count {
+				t.Errorf("state machine invoked, %d saves, want %d", v, count)
+			}
+			// active shard
+			makeProposals(nh)
+			second, err := exportIfChanged(nh, dir)
+			if err != nil {
+				t.Fatalf("failed to export %v", err)
+			}
+			if second.Index <= first.Index || second.PreviousIndex != first.Index {
+				t.Errorf("unexpected result %+v, first %+v", second, first)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestMembershipChangeIsExported(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			dir := getLeaderSnapshotExportDir(t, fs, nh)
+			first, err := exportIfChanged(nh, dir)
+			if err != nil {
+				t.Fatalf("failed to export %v", err)
+			}
+			if _, err := exportIfChanged(nh, dir); !errors.Is(err, ErrSnapshotUnchanged) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			if err := nh.SyncRequestAddNonVoting(ctx,
+				1, 2, "localhost:25000", 0); err != nil {
+				t.Fatalf("failed to add non-voting %v", err)
+			}
+			second, err := exportIfChanged(nh, dir)
+			if err != nil {
+				t.Fatalf("failed to export %v", err)
+			}
+			if second.Index <= first.Index || second.PreviousIndex != first.Index {
+				t.Errorf("unexpected result %+v, first %+v", second, first)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestForwardedExportCanBeSkippedWhenUnchanged(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		nhs := startLeaderSnapshotTestShard(t, fs)
+		for _, nh := range nhs {
+			defer nh.Close()
+		}
+		leaderID := getLeaderSnapshotTestLeader(t, nhs)
+		makeProposals(nhs[leaderID-1])
+		follower := nhs[leaderID%3]
+		dir := getLeaderSnapshotExportDir(t, fs, follower)
+		export := func() (ExportResult, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(follower))
+			defer cancel()
+			opt := SnapshotOption{
+				ExportPath:      dir,
+				LeaderOnly:      true,
+				SkipIfUnchanged: true,
+			}
+			return follower.SyncExportSnapshot(ctx, 1, opt)
+		}
+		first, err := export()
+		if err != nil {
+			t.Fatalf("failed to export %v", err)
+		}
+		_, err = export()
+		var sue *SnapshotUnchangedError
+		if !errors.As(err, &sue) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if sue.Index != first.Index {
+			t.Errorf("index %d, want %d", sue.Index, first.Index)
+		}
+		makeProposals(nhs[leaderID-1])
+		second, err := export()
+		if err != nil {
+			t.Fatalf("failed to export %v", err)
+		}
+		if second.ReplicaID != leaderID || second.PreviousIndex != first.Index {
+			t.Errorf("unexpected result %+v, first %+v", second, first)
+		}
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
@@ -0,0 +1,378 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build dragonboat_testfp
+// +build dragonboat_testfp
+
+package dragonboat
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/failpoint"
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+var failpointChild = flag.String("failpoint-child", "",
+	"failpoint to crash the spawned child on")
+
+const (
+	failpointTestWrites = 10
+	ackedPrefix         = "acked: "
+)
+
+// failpointTestSM records all applied payloads in order.
+type failpointTestSM struct {
+	data []string
+}
+
+func (s *failpointTestSM) Update(e sm.Entry) (sm.Result, error) {
+	s.data = append(s.data, string(e.Cmd))
+	return sm.Result{Value: uint64(len(s.data))}, nil
+}
+
+func (s *failpointTestSM) Lookup(query interface{}) (interface{}, error) {
+	return append([]string{}, s.data...), nil
+}
+
+func (s *failpointTestSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	_, err := w.Write([]byte(strings.Join(s.data, "\n")))
+	return err
+}
+
+func (s *failpointTestSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.data = nil
+	if len(data) > 0 {
+		s.data = strings.Split(string(data), "\n")
+	}
+	return nil
+}
+
+func (s *failpointTestSM) Close() error { return nil }
+
+type failpointCrashTest struct {
+	failpoint string
+	replicas  int
+	// crash has the failpoint reached after all acknowledged writes are made,
+	// a write is proposed with the failpoint enabled when crash is not set.
+	crash func(t *testing.T, fs vfs.IFS, nhs []*NodeHost)
+	// check checks the restarted replicas.
+	check func(t *testing.T, nhs []*NodeHost)
+}
+
+func startFailpointTestNodeHosts(t *testing.T,
+	fs vfs.IFS, replicas int) []*NodeHost {
+	nhs, err := createMemTransportNodeHosts(memtransport.NewNetwork(),
+		replicas, nil, fs)
+	if err != nil {
+		t.Fatalf("failed to create nodehosts %v", err)
+	}
+	members := make(map[uint64]string)
+	for i := 1; i <= replicas; i++ {
+		members[uint64(i)] = memtransport.Address(i)
+	}
+	for i, nh := range nhs {
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    uint64(i + 1),
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
+		}
+		create := func(uint64, uint64) sm.IStateMachine {
+			return &failpointTestSM{}
+		}
+		if err := nh.StartReplica(members, false, create, rc); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+	}
+	for _, nh := range nhs {
+		waitForLeaderToBeElected(t, nh, 1)
+	}
+	return nhs
+}
+
+// proposeFailpointTestWrites proposes count writes and reports each
+// acknowledged one on stdout for the parent process.
+func proposeFailpointTestWrites(t *testing.T,
+	nh *NodeHost, start int, count int) {
+	session := nh.GetNoOPSession(1)
+	for i := start; i < start+count; i++ {
+		data := fmt.Sprintf("write-%d", i)
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+		_, err := nh.SyncPropose(ctx, session, []byte(data))
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to make proposal %v", err)
+		}
+		fmt.Printf("%s%s\n", ackedPrefix, data)
+	}
+}
+
+func readFailpointTestData(t *testing.T, nh *NodeHost) []string {
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+		result, err := nh.SyncRead(ctx, 1, nil)
+		cancel()
+		if err == nil {
+			return result.([]string)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("failed to read")
+	return nil
+}
+
+// checkSnapshotIsComplete checks that the snapshot recorded in the LogDB, if
+// any, has its snapshot file fully written to its final directory.
+func checkSnapshotIsComplete(t *testing.T, nh *NodeHost, replicaID uint64) {
+	ss, err := nh.mu.logdb.GetSnapshot(1, replicaID)
+	if err != nil {
+		t.Fatalf("failed to get snapshot %v", err)
+	}
+	if ss.Index == 0 {
+		return
+	}
+	fi, err := nh.fs.Stat(ss.Filepath)
+	if err != nil {
+		t.Fatalf("snapshot %d not visible, %v", ss.Index, err)
+	}
+	if uint64(fi.Size()) != ss.FileSize {
+		t.Fatalf("snapshot %d size %d, want %d", ss.Index, fi.Size(), ss.FileSize)
+	}
+}
+
+// checkNoPartialSnapshot checks that no temp or unrecorded snapshot directory
+// is left once the replica is restarted.
+func checkNoPartialSnapshot(t *testing.T, nh *NodeHost, replicaID uint64) {
+	ss, err := nh.mu.logdb.GetSnapshot(1, replicaID)
+	if err != nil {
+		t.Fatalf("failed to get snapshot %v", err)
+	}
+	dir := nh.env.GetSnapshotDir(nh.nhConfig.GetDeploymentID(), 1, replicaID)
+	names, err := nh.fs.List(dir)
+	if err != nil {
+		t.Fatalf("failed to list %v", err)
+	}
+	for _, name := range names {
+		if server.GenSnapshotDirNameRe.MatchString(name) ||
+			server.RecvSnapshotDirNameRe.MatchString(name) {
+			t.Errorf("temp snapshot dir %s left", name)
+		}
+		if !server.SnapshotDirNameRe.MatchString(name) {
+			continue
+		}
+		fdir := nh.fs.PathJoin(dir, name)
+		if fileutil.HasFlagFile(fdir, fileutil.SnapshotFlagFilename, nh.fs) {
+			t.Errorf("unrecorded snapshot dir %s left", name)
+		}
+		if name > server.GetSnapshotDirName(ss.Index) {
+			t.Errorf("snapshot dir %s newer than snapshot %d", name, ss.Index)
+		}
+	}
+}
+
+func getAckedWrites(out []byte) []string {
+	var acked []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, ackedPrefix) {
+			acked = append(acked, strings.TrimPrefix(line, ackedPrefix))
+		}
+	}
+	return acked
+}
+
+func runFailpointCrashChild(t *testing.T, fs vfs.IFS, tt failpointCrashTest) {
+	nhs := startFailpointTestNodeHosts(t, fs, tt.replicas)
+	proposeFailpointTestWrites(t, nhs[0], 0, failpointTestWrites)
+	if tt.crash == nil {
+		if err := failpoint.Enable(tt.failpoint, failpoint.Panic()); err != nil {
+			t.Fatalf("failed to enable failpoint %v", err)
+		}
+		proposeFailpointTestWrites(t, nhs[0], failpointTestWrites, 1)
+	} else {
+		tt.crash(t, fs, nhs)
+	}
+	time.Sleep(10 * time.Second)
+	t.Fatalf("failpoint %s not reached, hits %d",
+		tt.failpoint, failpoint.Hits(tt.failpoint))
+}
+
+func testFailpointCrashRecovery(t *testing.T, fs vfs.IFS, tt failpointCrashTest) {
+	out, err := exec.Command(os.Args[0], "-failpoint-child="+tt.failpoint,
+		"-test.v", "-test.run=^TestFailpointCrashRecovery$/^"+tt.failpoint+"$",
+	).CombinedOutput()
+	if err == nil {
+		t.Fatalf("child didn't crash\n%s", out)
+	}
+	msg := fmt.Sprintf("failpoint %s: %s", tt.failpoint, failpoint.ErrInjected)
+	if !bytes.Contains(out, []byte(msg)) {
+		t.Fatalf("child didn't crash on the failpoint\n%s", out)
+	}
+	acked := getAckedWrites(out)
+	if len(acked) < failpointTestWrites {
+		t.Fatalf("unexpected acked writes %v\n%s", acked, out)
+	}
+	nhs, err := createMemTransportNodeHosts(memtransport.NewNetwork(),
+		tt.replicas, nil, fs)
+	if err != nil {
+		t.Fatalf("failed to create nodehosts %v", err)
+	}
+	for i, nh := range nhs {
+		checkSnapshotIsComplete(t, nh, uint64(i+1))
+		nh.Close()
+	}
+	nhs = startFailpointTestNodeHosts(t, fs, tt.replicas)
+	defer func() {
+		for _, nh := range nhs {
+			nh.Close()
+		}
+	}()
+	for i, nh := range nhs {
+		data := readFailpointTestData(t, nh)
+		if len(data) < len(acked) {
+			t.Fatalf("acked writes lost, got %v, acked %v", data, acked)
+		}
+		for j := range acked {
+			if data[j] != acked[j] {
+				t.Fatalf("acked writes lost, got %v, acked %v", data, acked)
+			}
+		}
+		checkNoPartialSnapshot(t, nh, uint64(i+1))
+	}
+	if tt.check != nil {
+		tt.check(t, nhs)
+	}
+}
+
+func requestFailpointTestSnapshot(t *testing.T, nh *NodeHost) {
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+	defer cancel()
+	if _, err := nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption); err != nil {
+		t.Fatalf("failed to request snapshot %v", err)
+	}
+}
+
+func crashOnSnapshot(t *testing.T, nhs []*NodeHost, name string) {
+	if err := failpoint.Enable(name, failpoint.Panic()); err != nil {
+		t.Fatalf("failed to enable failpoint %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[0]))
+	defer cancel()
+	_, _ = nhs[0].SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption)
+}
+
+func TestFailpointCrashRecovery(t *testing.T) {
+	fs := vfs.GetTestFS()
+	if fs != vfs.DefaultFS {
+		t.Skip("not using the default fs, skipped")
+	}
+	crashTests := []failpointCrashTest{
+		{
+			failpoint: failpoint.AfterSaveRaftState,
+			replicas:  1,
+		},
+		{
+			failpoint: failpoint.BeforeReplicateResp,
+			replicas:  3,
+		},
+		{
+			failpoint: failpoint.BeforeSnapshotRename,
+			replicas:  1,
+			crash: func(t *testing.T, fs vfs.IFS, nhs []*NodeHost) {
+				crashOnSnapshot(t, nhs, failpoint.BeforeSnapshotRename)
+			},
+		},
+		{
+			failpoint: failpoint.AfterSnapshotRename,
+			replicas:  1,
+			crash: func(t *testing.T, fs vfs.IFS, nhs []*NodeHost) {
+				crashOnSnapshot(t, nhs, failpoint.AfterSnapshotRename)
+			},
+		},
+		{
+			failpoint: failpoint.AfterConfigChangeApply,
+			replicas:  1,
+			crash: func(t *testing.T, fs vfs.IFS, nhs []*NodeHost) {
+				if err := failpoint.Enable(failpoint.AfterConfigChangeApply,
+					failpoint.Panic()); err != nil {
+					t.Fatalf("failed to enable failpoint %v", err)
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[0]))
+				defer cancel()
+				_ = nhs[0].SyncRequestAddNonVoting(ctx, 1, 2, "localhost:1234", 0)
+			},
+			check: func(t *testing.T, nhs []*NodeHost) {
+				// the config change entry was committed before the crash
+				ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[0]))
+				defer cancel()
+				m, err := nhs[0].SyncGetShardMembership(ctx, 1)
+				if err != nil {
+					t.Fatalf("failed to get membership %v", err)
+				}
+				if _, ok := m.NonVotings[2]; !ok {
+					t.Errorf("committed config change lost, %+v", m)
+				}
+			},
+		},
+		{
+			failpoint: failpoint.BeforeRecoverFromSnapshot,
+			replicas:  1,
+			crash: func(t *testing.T, fs vfs.IFS, nhs []*NodeHost) {
+				requestFailpointTestSnapshot(t, nhs[0])
+				proposeFailpointTestWrites(t, nhs[0], failpointTestWrites, 1)
+				for _, nh := range nhs {
+					nh.Close()
+				}
+				if err := failpoint.Enable(failpoint.BeforeRecoverFromSnapshot,
+					failpoint.Panic()); err != nil {
+					t.Fatalf("failed to enable failpoint %v", err)
+				}
+				startFailpointTestNodeHosts(t, fs, len(nhs))
+			},
+		},
+	}
+	for _, tt := range crashTests {
+		tt := tt
+		t.Run(tt.failpoint, func(t *testing.T) {
+			if *failpointChild != "" {
+				runFailpointCrashChild(t, fs, tt)
+				return
+			}
+			runNodeHostTestDC(t, func() {
+				testFailpointCrashRecovery(t, fs, tt)
+			}, true, fs)
+		})
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+var (
+	// ErrFenceExpired indicates that the leadership the leader fence was
+	// acquired for has been lost, see NodeHost.AcquireLeaderFence for details.
+	ErrFenceExpired = errors.New("leader fence expired")
+)
+
+// Fence is a leader fence acquired by the leader of a shard in a specific
+// term, see NodeHost.AcquireLeaderFence for details.
+type Fence struct {
+	shardID   uint64
+	replicaID uint64
+	term      uint64
+	nh        *NodeHost
+	n         *node
+}
+
+// ShardID returns the ID of the shard the fence was acquired for.
+func (f Fence) ShardID() uint64 {
+	return f.shardID
+}
+
+// ReplicaID returns the ID of the replica that acquired the fence.
+func (f Fence) ReplicaID() uint64 {
+	return f.replicaID
+}
+
+// Token returns the fencing token, which is the Raft term in which the fence
+// was acquired. Tokens of fences acquired for the same shard never decrease,
+// external systems can reject operations carrying a token lower than the
+// highest token they have seen.
+func (f Fence) Token() uint64 {
+	return f.term
+}
+
+// StillValid returns a boolean value indicating whether the acquiring replica
+// still considers itself as the leader in the term of the fence. It doesn't
+// involve any communication with other replicas, use Validate to confirm the
+// leadership with the majority of the shard.
+func (f Fence) StillValid() bool {
+	if f.n == nil || f.n.stopped() || f.n.removed() {
+		return false
+	}
+	return f.n.isLeaderInTerm(f.term)
+}
+
+// Validate confirms that the acquiring replica is still the leader in the term
+// of the fence by performing a ReadIndex round with the majority of the
+// shard. ErrFenceExpired is returned when the leadership has been lost. The
+// specified context parameter must have the timeout value set.
+func (f Fence) Validate(ctx context.Context) error {
+	if !f.StillValid() {
+		return ErrFenceExpired
+	}
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	rs, n, err := f.nh.readIndex(ctx, f.shardID, timeout)
+	if err == nil {
+		_, err = getRequestResult(ctx, rs)
+		if err == nil {
+			rs.Release()
+		}
+	}
+	if n != f.n || !f.StillValid() {
+		return ErrFenceExpired
+	}
+	return err
+}
+
+// AcquireLeaderFence acquires a leader fence on the local replica of the
+// specified shard, which must be the leader of the shard. The leadership is
+// confirmed with the majority of the shard before the fence is returned.
+// ErrNotLeader is returned when the local replica is not the leader, the
+// returned error is a *NotLeaderError when the leader is known.
+//
+// The fence remains valid as long as the local replica is the leader in the
+// term in which the fence was acquired. Proposals made using
+// SyncProposeWithOption with the fence are rejected with ErrFenceExpired when
+// they are not appended to the log in that term, such rejection is made by
+// all replicas when applying the entry. The token of the fence can be attached
+// to operations on external systems, see Fence.Token for details. The
+// specified context parameter must have the timeout value set.
+func (nh *NodeHost) AcquireLeaderFence(ctx context.Context,
+	shardID uint64) (Fence, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return Fence{}, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return Fence{}, nh.shardNotFound(shardID)
+	}
+	leaderID, term, ok := n.getLeaderID()
+	if !ok || leaderID != n.replicaID {
+		return Fence{}, n.notLeaderError()
+	}
+	f := Fence{
+		shardID:   shardID,
+		replicaID: n.replicaID,
+		term:      term,
+		nh:        nh,
+		n:         n,
+	}
+	if err := f.Validate(ctx); err != nil {
+		return Fence{}, err
+	}
+	return f, nil
+}
+
+// ProposeOption is the option type used by SyncProposeWithOption.
+type ProposeOption struct {
+	// Fence is the leader fence the proposal is made with, the proposal is
+	// rejected with ErrFenceExpired when it is not appended to the log in the
+	// term of the fence. Fenced proposals are never chunked.
+	//
+	// Fenced proposals are encoded in a way that can't be applied by replicas
+	// running earlier versions of dragonboat. During a rolling upgrade, they
+	// are rejected with ErrShardNotReady until all members of the shard other
+	// than witnesses have advertised support to the leader.
+	Fence *Fence
+}
+
+// SyncProposeWithOption is similar to SyncPropose, it allows the caller to
+// specify the ProposeOption. ErrFenceExpired is returned when the specified
+// fence expired before or after the proposal was made, the proposal can be
+// retried without updating the client session instance in that case.
+// ErrShardNotReady is returned when not all members support fenced proposals
+// yet, see ProposeOption.Fence for details. ErrInvalidOption is returned when the fence was not acquired on this
+// NodeHost for the shard of the client session.
+func (nh *NodeHost) SyncProposeWithOption(ctx context.Context,
+	session *client.Session, cmd []byte, opt ProposeOption) (sm.Result, error) {
+	if opt.Fence == nil {
+		return nh.SyncPropose(ctx, session, cmd)
+	}
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	rs, err := nh.proposeFenced(ctx, session, cmd, *opt.Fence, timeout)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	result, err := getRequestState(ctx, rs)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	rs.Release()
+	return result, getApplicationError(session.ShardID, result)
+}
+
+func (nh *NodeHost) proposeFenced(ctx context.Context, s *client.Session,
+	cmd []byte, f Fence, timeout time.Duration) (*RequestState, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	if f.nh != nh || f.shardID != s.ShardID {
+		return nil, ErrInvalidOption
+	}
+	n, ok := nh.getShard(s.ShardID)
+	if !ok {
+		return nil, nh.shardNotFound(s.ShardID)
+	}
+	if n != f.n || !f.StillValid() {
+		return nil, ErrFenceExpired
+	}
+	if !n.membersSupport(pb.ProtocolVersion) {
+		return nil, ErrShardNotReady
+	}
+	if !n.supportClientSession() && !s.IsNoOPSession() {
+		panic("IOnDiskStateMachine based nodes must use NoOPSession")
+	}
+	ct := n.config.EntryCompressionType
+	if rsm.GetMaxBlockSize(ct) < uint64(len(cmd)) {
+		return nil, ErrPayloadTooBig
+	}
+	var encoded []byte
+	if len(cmd) > 0 {
+		encoded = preparePayload(ct, cmd)
+	}
+	req, err := n.proposeEncoded(ctx, s,
+		rsm.GetFenced(f.term, encoded), nh.getTimeoutTick(timeout))
+	nh.engine.setStepReady(s.ShardID)
+	return req, err
+}
@@ -0,0 +1,166 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/transport"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func TestFencedProposalIsRejectedAfterLeaderChange(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := make(map[uint64]string)
+		for i := range nhs {
+			members[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		startCloneTestShard(t, nhs, 1, []uint64{1, 2, 3}, members)
+		leaderID, term, ok, err := nhs[0].GetLeaderID(1)
+		if err != nil || !ok {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		leader := nhs[leaderID-1]
+		targetID := leaderID%uint64(len(nhs)) + 1
+		ctx, cancel := context.WithTimeout(context.Background(), pto(leader))
+		defer cancel()
+		if _, err := nhs[targetID-1].AcquireLeaderFence(ctx,
+			1); !errors.Is(err, ErrNotLeader) {
+			t.Fatalf("fence acquired on follower, %v", err)
+		}
+		fence, err := leader.AcquireLeaderFence(ctx, 1)
+		if err != nil {
+			t.Fatalf("failed to acquire fence %v", err)
+		}
+		if fence.Token() != term || fence.ShardID() != 1 ||
+			fence.ReplicaID() != leaderID {
+			t.Fatalf("unexpected fence %+v", fence)
+		}
+		opt := ProposeOption{Fence: &fence}
+		session := leader.GetNoOPSession(1)
+		if _, err := leader.SyncProposeWithOption(ctx,
+			session, []byte("k=v1"), opt); err != nil {
+			t.Fatalf("fenced proposal failed %v", err)
+		}
+		if _, err := nhs[targetID-1].SyncProposeWithOption(ctx,
+			nhs[targetID-1].GetNoOPSession(1),
+			[]byte("k=v2"), opt); !errors.Is(err, ErrInvalidOption) {
+			t.Fatalf("fence used on other NodeHost, %v", err)
+		}
+		// the transfer is requested again when the target is not ready
+		for i := 0; ; i++ {
+			if i > 100 {
+				t.Fatalf("leadership not transferred")
+			}
+			if err := leader.RequestLeaderTransfer(1, targetID); err != nil {
+				t.Fatalf("failed to transfer leadership %v", err)
+			}
+			id, _, ok, err := leader.GetLeaderID(1)
+			if err == nil && ok && id == targetID {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if fence.StillValid() {
+			t.Errorf("fence still valid after leader change")
+		}
+		if err := fence.Validate(ctx); !errors.Is(err, ErrFenceExpired) {
+			t.Errorf("unexpected error %v", err)
+		}
+		if _, err := leader.SyncProposeWithOption(ctx,
+			session, []byte("k=v2"), opt); !errors.Is(err, ErrFenceExpired) {
+			t.Errorf("unexpected error %v", err)
+		}
+		// the entry made with the expired fence is appended by the new leader
+		// and rejected when it is applied
+		n, ok := leader.getShard(1)
+		if !ok {
+			t.Fatalf("failed to get node")
+		}
+		encoded := rsm.GetFenced(fence.Token(),
+			preparePayload(n.config.EntryCompressionType, []byte("k=v3")))
+		rs, err := n.proposeEncoded(ctx,
+			session, encoded, leader.getTimeoutTick(pto(leader)))
+		if err != nil {
+			t.Fatalf("failed to propose %v", err)
+		}
+		leader.engine.setStepReady(1)
+		if _, err := getRequestState(ctx, rs); !errors.Is(err, ErrFenceExpired) {
+			t.Errorf("unexpected error %v", err)
+		}
+		if v := readCloneTestValue(t, leader, 1, "k"); v != "v1" {
+			t.Errorf("unexpected value %s", v)
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
+
+func TestFencedProposalIsRejectedUntilAllMembersSupportIt(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := make(map[uint64]string)
+		for i := range nhs {
+			members[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		startCloneTestShard(t, nhs, 1, []uint64{1, 2, 3}, members)
+		leaderID, _, ok, err := nhs[0].GetLeaderID(1)
+		if err != nil || !ok {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		leader := nhs[leaderID-1]
+		older := nhs[leaderID%uint64(len(nhs))]
+		predateProtocolVersion(older)
+		time.Sleep(500 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), pto(leader))
+		defer cancel()
+		fence, err := leader.AcquireLeaderFence(ctx, 1)
+		if err != nil {
+			t.Fatalf("failed to acquire fence %v", err)
+		}
+		opt := ProposeOption{Fence: &fence}
+		session := leader.GetNoOPSession(1)
+		if _, err := leader.SyncProposeWithOption(ctx,
+			session, []byte("k=v1"), opt); !errors.Is(err, ErrShardNotReady) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		// the follower is upgraded
+		tt := older.transport.(*transport.Transport)
+		tt.SetPreSendBatchHook(func(mb pb.MessageBatch) (pb.MessageBatch, bool) {
+			return mb, true
+		})
+		for i := 0; ; i++ {
+			_, err := leader.SyncProposeWithOption(ctx, session, []byte("k=v1"), opt)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, ErrShardNotReady) || i > 100 {
+				t.Fatalf("fenced proposal failed %v", err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if v := readCloneTestValue(t, leader, 1, "k"); v != "v1" {
+			t.Errorf("unexpected value %s", v)
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
@@ -0,0 +1,226 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/server"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// fingerprintHistorySize is the number of snapshot fingerprints kept by each
+// replica.
+const fingerprintHistorySize = 16
+
+var (
+	// ErrFingerprintNotFound indicates that no snapshot fingerprint is
+	// available at the requested index.
+	ErrFingerprintNotFound = errors.New("snapshot fingerprint not found")
+	// ErrFingerprintMismatch indicates that replicas have different state
+	// machine fingerprints at the same index.
+	ErrFingerprintMismatch = errors.New("snapshot fingerprint mismatch")
+)
+
+// SnapshotFingerprint is the state machine fingerprint of a snapshot created
+// or recovered by the local replica, see statemachine.IFingerprint for
+// details.
+type SnapshotFingerprint struct {
+	// Index is the index of the snapshot.
+	Index uint64
+	// Term is the term of the snapshot.
+	Term uint64
+	// Fingerprint is the fingerprint of the local state machine at Index.
+	Fingerprint uint64
+	// Received indicates whether the local replica recovered from the
+	// snapshot received from a remote replica.
+	Received bool
+	// Recorded is the fingerprint recorded in the received snapshot by the
+	// remote replica, it is 0 when Received is false.
+	Recorded uint64
+}
+
+// Mismatched returns a boolean value indicating whether the fingerprint of the
+// state machine recovered from the received snapshot differs from the recorded
+// one.
+func (f SnapshotFingerprint) Mismatched() bool {
+	return f.Received && f.Recorded != f.Fingerprint
+}
+
+// FingerprintMismatchError is the error returned by CompareSnapshotFingerprints
+// when replicas have different fingerprints at the same index. Fingerprints
+// are keyed by the NodeHost ID.
+type FingerprintMismatchError struct {
+	Fingerprints map[string]uint64
+	ShardID      uint64
+	Index        uint64
+}
+
+func (e *FingerprintMismatchError) Error() string {
+	ids := make([]string, 0, len(e.Fingerprints))
+	for id := range e.Fingerprints {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	values := make([]string, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, fmt.Sprintf("%s: %d", id, e.Fingerprints[id]))
+	}
+	return fmt.Sprintf("shard %d has different fingerprints at index %d, %s",
+		e.ShardID, e.Index, strings.Join(values, ", "))
+}
+
+// Unwrap returns ErrFingerprintMismatch.
+func (e *FingerprintMismatchError) Unwrap() error {
+	return ErrFingerprintMismatch
+}
+
+type fingerprintHistory struct {
+	mu      sync.Mutex
+	records []SnapshotFingerprint
+}
+
+func (h *fingerprintHistory) add(r SnapshotFingerprint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.records) >= fingerprintHistorySize {
+		h.records = h.records[1:]
+	}
+	h.records = append(h.records, r)
+}
+
+func (h *fingerprintHistory) get() []SnapshotFingerprint {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]SnapshotFingerprint{}, h.records...)
+}
+
+// GetSnapshotFingerprints returns the state machine fingerprints of the most
+// recent snapshots created or recovered by the local replica of the specified
+// shard, the oldest comes first. Only snapshots of state machines implementing
+// statemachine.IFingerprint have fingerprints.
+func (nh *NodeHost) GetSnapshotFingerprints(
+	shardID uint64) ([]SnapshotFingerprint, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nil, ErrShardNotFound
+	}
+	return n.fingerprints.get(), nil
+}
+
+// CompareSnapshotFingerprints compares the state machine fingerprints of the
+// specified shard at the specified barrier index across the specified
+// NodeHosts. A *FingerprintMismatchError is returned when fingerprints are
+// different, ErrFingerprintNotFound is returned when any NodeHost has no
+// fingerprint at the index.
+//
+// Replicas only have fingerprints at the indexes of the snapshots they created
+// or recovered from. A barrier index can be established by making sure all
+// replicas have applied the same entries, e.g. by stopping writes and waiting
+// for a SyncRead on each replica to complete, and then requesting a snapshot
+// on each replica.
+func CompareSnapshotFingerprints(shardID uint64,
+	index uint64, nhs ...*NodeHost) error {
+	fingerprints := make(map[string]uint64)
+	mismatched := false
+	for _, nh := range nhs {
+		records, err := nh.GetSnapshotFingerprints(shardID)
+		if err != nil {
+			return err
+		}
+		fp, ok := uint64(0), false
+		for _, r := range records {
+			if r.Index == index {
+				fp, ok = r.Fingerprint, true
+			}
+		}
+		if !ok {
+			return errors.Wrapf(ErrFingerprintNotFound, "%s index %d",
+				nh.ID(), index)
+		}
+		for _, v := range fingerprints {
+			if v != fp {
+				mismatched = true
+			}
+		}
+		fingerprints[nh.ID()] = fp
+	}
+	if mismatched {
+		return &FingerprintMismatchError{
+			Fingerprints: fingerprints,
+			ShardID:      shardID,
+			Index:        index,
+		}
+	}
+	return nil
+}
+
+// recordFingerprint records the fingerprint of the snapshot created by the
+// local replica.
+func (n *node) recordFingerprint(ss pb.Snapshot) {
+	if ss.Fingerprint != 0 {
+		n.fingerprints.add(SnapshotFingerprint{
+			Index:       ss.Index,
+			Term:        ss.Term,
+			Fingerprint: ss.Fingerprint,
+		})
+	}
+}
+
+// verifyFingerprint compares the fingerprint recorded in the received snapshot
+// with the one of the state machine recovered from it, a
+// SnapshotFingerprintMismatch event is published when they are different.
+func (n *node) verifyFingerprint(ss pb.Snapshot) error {
+	if ss.Fingerprint == 0 {
+		return nil
+	}
+	fp, ok, err := n.sm.GetFingerprint(ss)
+	if err != nil {
+		return errors.Wrapf(err, "%s failed to get fingerprint", n.id())
+	}
+	if !ok {
+		return nil
+	}
+	r := SnapshotFingerprint{
+		Index:       ss.Index,
+		Term:        ss.Term,
+		Fingerprint: fp,
+		Received:    true,
+		Recorded:    ss.Fingerprint,
+	}
+	n.fingerprints.add(r)
+	if r.Mismatched() {
+		plog.Errorf("%s fingerprint mismatch after recovering from %s, "+
+			"recorded %d, computed %d", n.id(), n.ssid(ss.Index), r.Recorded, fp)
+		n.sysEvents.Publish(server.SystemEvent{
+			Type:       server.SnapshotFingerprintMismatch,
+			ShardID:    n.shardID,
+			ReplicaID:  n.replicaID,
+			Index:      ss.Index,
+			LocalHash:  fp,
+			RemoteHash: ss.Fingerprint,
+		})
+	}
+	return nil
+}
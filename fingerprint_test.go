@@ -0,0 +1,270 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/lni/goutils/random"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// fingerprintSM is a test state machine implementing sm.IFingerprint. The
+// fingerprint of a non-deterministic fingerprintSM includes a random salt of
+// the instance, replicas thus never agree on the fingerprint.
+type fingerprintSM struct {
+	sum  uint64
+	salt uint64
+}
+
+var _ sm.IFingerprint = (*fingerprintSM)(nil)
+
+func newFingerprintSM(deterministic bool) *fingerprintSM {
+	s := &fingerprintSM{}
+	if !deterministic {
+		s.salt = random.LockGuardedRand.Uint64()
+	}
+	return s
+}
+
+func (s *fingerprintSM) Update(e sm.Entry) (sm.Result, error) {
+	s.sum = s.sum*31 + uint64(len(e.Cmd))
+	return sm.Result{Value: s.sum}, nil
+}
+
+func (s *fingerprintSM) Lookup(query interface{}) (interface{}, error) {
+	return s.sum, nil
+}
+
+func (s *fingerprintSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, s.sum)
+	_, err := w.Write(data)
+	return err
+}
+
+func (s *fingerprintSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.sum = binary.LittleEndian.Uint64(data)
+	return nil
+}
+
+func (s *fingerprintSM) Fingerprint() (uint64, error) {
+	return (s.sum*2654435761 + s.salt) | 1, nil
+}
+
+func (s *fingerprintSM) Close() error { return nil }
+
+func getFingerprintTestConfig(replicaID uint64) config.Config {
+	return config.Config{
+		ShardID:            1,
+		ReplicaID:          replicaID,
+		ElectionRTT:        10,
+		HeartbeatRTT:       1,
+		CheckQuorum:        true,
+		CompactionOverhead: 5,
+	}
+}
+
+// fingerprintNodeHostTest is similar to memTransportNodeHostTest, each
+// NodeHost has a testSysEventListener.
+func fingerprintNodeHostTest(t *testing.T, count int,
+	tf func(t *testing.T, nhs []*NodeHost, listeners []*testSysEventListener),
+	fs vfs.IFS) {
+	var listeners []*testSysEventListener
+	update := func(nhc *config.NodeHostConfig) *config.NodeHostConfig {
+		listener := &testSysEventListener{}
+		nhc.SystemEventListener = listener
+		listeners = append(listeners, listener)
+		return nhc
+	}
+	updatedMemTransportNodeHostTest(t, count, update,
+		func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+			tf(t, nhs, listeners)
+		}, fs)
+}
+
+// requestFingerprintTestSnapshot requests a snapshot on the specified
+// NodeHost once all committed entries are applied by the local replica.
+func requestFingerprintTestSnapshot(t *testing.T, nh *NodeHost) SnapshotResult {
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+	defer cancel()
+	if _, err := nh.SyncRead(ctx, 1, nil); err != nil {
+		t.Fatalf("failed to read %v", err)
+	}
+	r, err := nh.SyncRequestSnapshotWithResult(ctx, 1, SnapshotOption{})
+	if err != nil {
+		t.Fatalf("failed to request snapshot %v", err)
+	}
+	if r.Fingerprint == 0 {
+		t.Fatalf("fingerprint not recorded, %+v", r)
+	}
+	return r
+}
+
+func TestSnapshotFingerprintsMatchAcrossReplicas(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, nhs []*NodeHost, listeners []*testSysEventListener) {
+		peers := make(map[uint64]string)
+		for i := range nhs {
+			peers[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		for i, nh := range nhs {
+			createSM := func(uint64, uint64) sm.IStateMachine {
+				return newFingerprintSM(true)
+			}
+			rc := getFingerprintTestConfig(uint64(i + 1))
+			if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+				t.Fatalf("failed to start replica %v", err)
+			}
+		}
+		for _, nh := range nhs {
+			waitForLeaderToBeElected(t, nh, 1)
+		}
+		for i := 0; i < 10; i++ {
+			if !makeTestProposal(nhs[0], 100) {
+				t.Fatalf("failed to make proposal")
+			}
+		}
+		index := uint64(0)
+		for _, nh := range nhs {
+			r := requestFingerprintTestSnapshot(t, nh)
+			if index != 0 && r.Index != index {
+				t.Fatalf("unexpected snapshot index %d, want %d", r.Index, index)
+			}
+			index = r.Index
+		}
+		if err := CompareSnapshotFingerprints(1, index, nhs...); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		err := CompareSnapshotFingerprints(1, index+1, nhs...)
+		if !errors.Is(err, ErrFingerprintNotFound) {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	fingerprintNodeHostTest(t, 3, tf, fs)
+}
+
+// testReceivedSnapshotFingerprint recovers the second replica from the
+// snapshot received from the first replica and returns the fingerprint record
+// of the received snapshot.
+func testReceivedSnapshotFingerprint(t *testing.T,
+	nhs []*NodeHost, deterministic bool) SnapshotFingerprint {
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return newFingerprintSM(deterministic)
+	}
+	peers := map[uint64]string{1: memtransport.Address(1)}
+	if err := nhs[0].StartReplica(peers,
+		false, createSM, getFingerprintTestConfig(1)); err != nil {
+		t.Fatalf("failed to start replica %v", err)
+	}
+	waitForLeaderToBeElected(t, nhs[0], 1)
+	for i := 0; i < 20; i++ {
+		if !makeTestProposal(nhs[0], 100) {
+			t.Fatalf("failed to make proposal")
+		}
+	}
+	created := requestFingerprintTestSnapshot(t, nhs[0])
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[0]))
+	defer cancel()
+	if err := nhs[0].SyncRequestAddReplica(ctx,
+		1, 2, memtransport.Address(2), 0); err != nil {
+		t.Fatalf("failed to add replica %v", err)
+	}
+	if err := nhs[1].StartReplica(nil,
+		true, createSM, getFingerprintTestConfig(2)); err != nil {
+		t.Fatalf("failed to start replica %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		records, err := nhs[1].GetSnapshotFingerprints(1)
+		if err != nil {
+			t.Fatalf("failed to get fingerprints %v", err)
+		}
+		if len(records) > 0 {
+			r := records[len(records)-1]
+			if !r.Received || r.Index != created.Index ||
+				r.Recorded != created.Fingerprint {
+				t.Fatalf("unexpected record %+v, created %+v", r, created)
+			}
+			return r
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("snapshot not received")
+	return SnapshotFingerprint{}
+}
+
+func TestReceivedSnapshotFingerprintIsVerified(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, nhs []*NodeHost, listeners []*testSysEventListener) {
+		r := testReceivedSnapshotFingerprint(t, nhs, true)
+		if r.Mismatched() {
+			t.Errorf("unexpected mismatch %+v", r)
+		}
+		if err := CompareSnapshotFingerprints(1, r.Index, nhs...); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		if len(listeners[1].getFingerprintMismatch()) != 0 {
+			t.Errorf("unexpected mismatch event")
+		}
+	}
+	fingerprintNodeHostTest(t, 2, tf, fs)
+}
+
+func TestNonDeterministicStateMachineIsDetected(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, nhs []*NodeHost, listeners []*testSysEventListener) {
+		r := testReceivedSnapshotFingerprint(t, nhs, false)
+		if !r.Mismatched() {
+			t.Errorf("mismatch not detected %+v", r)
+		}
+		err := CompareSnapshotFingerprints(1, r.Index, nhs...)
+		var fe *FingerprintMismatchError
+		if !errors.Is(err, ErrFingerprintMismatch) || !errors.As(err, &fe) ||
+			len(fe.Fingerprints) != 2 {
+			t.Errorf("unexpected error %v", err)
+		}
+		for i := 0; ; i++ {
+			events := listeners[1].getFingerprintMismatch()
+			if len(events) == 1 {
+				e := events[0]
+				if e.ShardID != 1 || e.ReplicaID != 2 || e.Index != r.Index ||
+					e.Recorded != r.Recorded || e.Computed != r.Fingerprint {
+					t.Errorf("unexpected event %+v", e)
+				}
+				break
+			}
+			if i > 200 {
+				t.Fatalf("mismatch event not published, %d", len(events))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	fingerprintNodeHostTest(t, 2, tf, fs)
+}
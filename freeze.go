@@ -0,0 +1,364 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// FreezeShard freezes the local replica of the specified shard to release its
+// runtime resources, e.g. when the shard is expected to stay idle for a long
+// period of time. A snapshot is taken when there are entries applied since the
+// latest snapshot, the replica is then stopped with its state machine closed
+// and marked as frozen in the local bootstrap info. All Raft state remains in
+// the LogDB and the snapshot directory, ThawShard restarts the replica from
+// such local state.
+//
+// Frozen replicas are included in the NodeHostInfo returned by
+// GetNodeHostInfo and in the shard info published to the gossip registry with
+// the IsFrozen flag set. They are not started by StartReplica and its variants
+// until thawed, i.e. the replica remains frozen after the NodeHost is
+// restarted. Requests targeting a frozen shard fail with ErrShardFrozen, see
+// config.NodeHostConfig.AutoThaw for automatically thawing frozen replicas on
+// demand. ErrInvalidOperation is returned when the local replica is a warm
+// standby not yet activated.
+func (nh *NodeHost) FreezeShard(ctx context.Context,
+	shardID uint64) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "FreezeShard",
+		ShardID:   shardID,
+	}, time.Now(), &err)
+	return nh.freezeShard(ctx, shardID)
+}
+
+// ThawShard restarts the frozen local replica of the specified shard from its
+// local state, it returns once the replica is initialized. ThawShard returns
+// immediately when the replica is not frozen, ErrShardNotFound is returned
+// when the NodeHost has no such replica.
+func (nh *NodeHost) ThawShard(ctx context.Context,
+	shardID uint64) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "ThawShard",
+		ShardID:   shardID,
+	}, time.Now(), &err)
+	return nh.thawShard(ctx, shardID)
+}
+
+func (nh *NodeHost) freezeShard(ctx context.Context, shardID uint64) error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		if _, ok := nh.frozen.getReplicaID(shardID); ok {
+			return nil
+		}
+		return ErrShardNotFound
+	}
+	if n.isStandby() {
+		return ErrInvalidOperation
+	}
+	if err := nh.snapshotBeforeFreeze(ctx, n); err != nil {
+		return err
+	}
+	smType := pb.StateMachineType(n.stateMachineType())
+	r := &frozenReplica{
+		cfg:      n.config,
+		createSM: n.createSM,
+		smType:   smType,
+		info:     getFrozenShardInfo(n.config, smType, n.sm.GetMembership()),
+		busy:     true,
+	}
+	if err := nh.frozen.add(r); err != nil {
+		return err
+	}
+	replicaID := n.replicaID
+	ldb := nh.mu.logdb
+	if err := setFrozen(ldb, shardID, replicaID, true); err != nil {
+		nh.frozen.remove(shardID)
+		return err
+	}
+	if err := nh.stopNode(shardID, replicaID, true); err != nil {
+		nh.frozen.remove(shardID)
+		return firstError(err, setFrozen(ldb, shardID, replicaID, false))
+	}
+	defer nh.frozen.release(shardID)
+	plog.Infof("%s frozen", n.id())
+	for nh.engine.nodeLoaded(shardID, replicaID) {
+		if err := nh.waitRTT(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotBeforeFreeze requests a snapshot when there are entries applied
+// since the latest snapshot, so the frozen replica doesn't have to replay them
+// when thawed.
+func (nh *NodeHost) snapshotBeforeFreeze(ctx context.Context, n *node) error {
+	if n.isWitness() {
+		return nil
+	}
+	index := uint64(0)
+	ss, err := n.snapshotter.GetSnapshotFromLogDB()
+	if err == nil {
+		index = ss.Index
+	} else if !errors.Is(err, ErrNoSnapshot) {
+		return err
+	}
+	if n.sm.GetLastApplied() <= index {
+		return nil
+	}
+	_, err = nh.SyncRequestSnapshot(ctx, n.shardID, DefaultSnapshotOption)
+	return err
+}
+
+func (nh *NodeHost) thawShard(ctx context.Context, shardID uint64) error {
+	for {
+		if atomic.LoadInt32(&nh.closed) != 0 {
+			return ErrClosed
+		}
+		r, busy := nh.frozen.acquire(shardID)
+		if r != nil {
+			if err := nh.restartFrozen(r); err != nil {
+				return err
+			}
+			break
+		}
+		if !busy {
+			// not frozen, or thawed by a concurrent caller
+			if _, ok := nh.getShard(shardID); !ok {
+				return ErrShardNotFound
+			}
+			break
+		}
+		if err := nh.waitRTT(ctx); err != nil {
+			return err
+		}
+	}
+	for {
+		n, ok := nh.getShard(shardID)
+		if !ok {
+			return ErrShardNotFound
+		}
+		if n.initialized() {
+			return nil
+		}
+		if err := nh.waitRTT(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// restartFrozen restarts the frozen replica acquired by the caller. The
+// replica is kept frozen when it can not be restarted.
+func (nh *NodeHost) restartFrozen(r *frozenReplica) error {
+	shardID := r.cfg.ShardID
+	replicaID := r.cfg.ReplicaID
+	ldb := nh.mu.logdb
+	if err := setFrozen(ldb, shardID, replicaID, false); err != nil {
+		nh.frozen.release(shardID)
+		return err
+	}
+	if err := nh.startShard(nil,
+		false, r.createSM, r.cfg, r.smType); err != nil {
+		nh.frozen.release(shardID)
+		return firstError(err, setFrozen(ldb, shardID, replicaID, true))
+	}
+	nh.frozen.remove(shardID)
+	plog.Infof("%s thawed", dn(shardID, replicaID))
+	return nil
+}
+
+// autoThaw thaws the specified frozen replica in the background when
+// config.NodeHostConfig.AutoThaw is enabled.
+func (nh *NodeHost) autoThaw(shardID uint64, replicaID uint64) {
+	if !nh.nhConfig.AutoThaw || atomic.LoadInt32(&nh.closed) != 0 ||
+		!nh.frozen.contains(shardID, replicaID) {
+		return
+	}
+	r, _ := nh.frozen.acquire(shardID)
+	if r == nil {
+		// being frozen or thawed
+		return
+	}
+	plog.Infof("%s auto thawing", dn(shardID, replicaID))
+	nh.stopper.RunWorker(func() {
+		if err := nh.restartFrozen(r); err != nil {
+			plog.Errorf("%s failed to auto thaw, %v", dn(shardID, replicaID), err)
+		}
+	})
+}
+
+// shardNotFound returns the error to be returned when a request targets a
+// shard without a running local replica. ErrReplicaRemoved is returned when
+// the local replica has been removed from the shard. Frozen replicas are thawed
+// in the background when config.NodeHostConfig.AutoThaw is enabled, the
+// request can be retried once thawed.
+func (nh *NodeHost) shardNotFound(shardID uint64) error {
+	if nh.removed.contains(shardID) {
+		return ErrReplicaRemoved
+	}
+	replicaID, ok := nh.frozen.getReplicaID(shardID)
+	if !ok {
+		return ErrShardNotFound
+	}
+	if !nh.nhConfig.AutoThaw {
+		return ErrShardFrozen
+	}
+	nh.autoThaw(shardID, replicaID)
+	return ErrShardNotReady
+}
+
+// setFrozen records in the bootstrap info whether the replica is frozen.
+func setFrozen(ldb raftio.ILogDB,
+	shardID uint64, replicaID uint64, frozen bool) error {
+	bi, err := ldb.GetBootstrapInfo(shardID, replicaID)
+	if err != nil {
+		return err
+	}
+	bi.Frozen = frozen
+	return ldb.SaveBootstrapInfo(shardID, replicaID, bi)
+}
+
+func getFrozenShardInfo(cfg config.Config,
+	smType pb.StateMachineType, m pb.Membership) ShardInfo {
+	_, isNonVoting := m.NonVotings[cfg.ReplicaID]
+	_, isWitness := m.Witnesses[cfg.ReplicaID]
+	return ShardInfo{
+		ShardID:           cfg.ShardID,
+		ReplicaID:         cfg.ReplicaID,
+		IsNonVoting:       isNonVoting,
+		IsWitness:         isWitness,
+		ConfigChangeIndex: m.ConfigChangeId,
+		Replicas:          m.Addresses,
+		NonVotings:        m.NonVotings,
+		Witnesses:         m.Witnesses,
+		StateMachineType:  sm.Type(smType),
+		IsFrozen:          true,
+	}
+}
+
+// frozenReplica is a frozen replica, it is restarted with its config and
+// state machine factory when thawed.
+type frozenReplica struct {
+	cfg      config.Config
+	createSM rsm.ManagedStateMachineFactory
+	smType   pb.StateMachineType
+	info     ShardInfo
+	// busy indicates that the replica is being frozen or thawed
+	busy bool
+}
+
+// frozenShards contains frozen replicas managed by the NodeHost.
+type frozenShards struct {
+	mu       sync.Mutex
+	replicas map[uint64]*frozenReplica
+}
+
+func (f *frozenShards) add(r *frozenReplica) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.replicas[r.cfg.ShardID]; ok {
+		return ErrShardAlreadyExist
+	}
+	if f.replicas == nil {
+		f.replicas = make(map[uint64]*frozenReplica)
+	}
+	f.replicas[r.cfg.ShardID] = r
+	return nil
+}
+
+func (f *frozenShards) remove(shardID uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.replicas, shardID)
+}
+
+// acquire marks the frozen replica as busy before thawing it. A nil replica is
+// returned when the replica is not frozen or it is busy, busy is set in the
+// latter case.
+func (f *frozenShards) acquire(shardID uint64) (*frozenReplica, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.replicas[shardID]
+	if !ok {
+		return nil, false
+	}
+	if r.busy {
+		return nil, true
+	}
+	r.busy = true
+	return r, false
+}
+
+func (f *frozenShards) release(shardID uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r, ok := f.replicas[shardID]; ok {
+		r.busy = false
+	}
+}
+
+// stop unregisters the frozen replica, it returns a boolean value indicating
+// whether such replica was found.
+func (f *frozenShards) stop(shardID uint64,
+	replicaID uint64, check bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.replicas[shardID]
+	if !ok || r.busy || (check && r.cfg.ReplicaID != replicaID) {
+		return false
+	}
+	delete(f.replicas, shardID)
+	return true
+}
+
+func (f *frozenShards) contains(shardID uint64, replicaID uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.replicas[shardID]
+	return ok && r.cfg.ReplicaID == replicaID
+}
+
+func (f *frozenShards) getReplicaID(shardID uint64) (uint64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r, ok := f.replicas[shardID]; ok {
+		return r.cfg.ReplicaID, true
+	}
+	return 0, false
+}
+
+func (f *frozenShards) getShardInfo() []ShardInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := make([]ShardInfo, 0, len(f.replicas))
+	for _, r := range f.replicas {
+		result = append(result, r.info)
+	}
+	return result
+}
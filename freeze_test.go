@@ -0,0 +1,249 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func getFrozenTestShardInfo(nh *NodeHost, shardID uint64) (ShardInfo, bool) {
+	nhi := nh.GetNodeHostInfo(NodeHostInfoOption{SkipLogInfo: true})
+	for _, ci := range nhi.ShardInfoList {
+		if ci.ShardID == shardID {
+			return ci, true
+		}
+	}
+	return ShardInfo{}, false
+}
+
+func TestFrozenShardCanBeThawed(t *testing.T) {
+	fs := vfs.GetTestFS()
+	thaw := func(nh *NodeHost) {
+		ci, ok := getFrozenTestShardInfo(nh, 1)
+		if !ok || !ci.IsFrozen || ci.LeaderID != 0 || len(ci.Replicas) != 1 {
+			t.Fatalf("unexpected shard info %+v", ci)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+		defer cancel()
+		if _, err := nh.SyncRead(ctx, 1, "k"); !errors.Is(err, ErrShardFrozen) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if err := nh.ThawShard(ctx, 1); err != nil {
+			t.Fatalf("failed to thaw %v", err)
+		}
+		if err := nh.ThawShard(ctx, 1); err != nil {
+			t.Fatalf("failed to thaw %v", err)
+		}
+		waitForLeaderToBeElected(t, nh, 1)
+		if v := readCloneTestValue(t, nh, 1, "k"); v != "1" {
+			t.Errorf("unexpected value %s", v)
+		}
+		if ci, ok := getFrozenTestShardInfo(nh, 1); !ok || ci.IsFrozen {
+			t.Errorf("unexpected shard info %+v", ci)
+		}
+	}
+	to := &testOption{
+		createSM:        newCloneTestSM,
+		restartNodeHost: true,
+		tf: func(nh *NodeHost) {
+			proposeCloneTestValue(t, nh, "k", 1)
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			if err := nh.FreezeShard(ctx, 1); err != nil {
+				t.Fatalf("failed to freeze %v", err)
+			}
+			if err := nh.FreezeShard(ctx, 1); err != nil {
+				t.Fatalf("failed to freeze %v", err)
+			}
+			if _, ok := nh.getShard(1); ok {
+				t.Fatalf("frozen replica still running")
+			}
+			bi, err := nh.mu.logdb.GetBootstrapInfo(1, 1)
+			if err != nil || !bi.Frozen {
+				t.Fatalf("frozen flag not persisted, %v", err)
+			}
+			if ss, err := nh.mu.logdb.GetSnapshot(1, 1); err != nil ||
+				ss.Index == 0 {
+				t.Errorf("no snapshot taken before freezing, %v", err)
+			}
+			if err := nh.ThawShard(ctx, 2); !errors.Is(err, ErrShardNotFound) {
+				t.Errorf("unexpected error %v", err)
+			}
+			thaw(nh)
+			if err := nh.FreezeShard(ctx, 1); err != nil {
+				t.Fatalf("failed to freeze %v", err)
+			}
+		},
+		// the replica remains frozen after the restart
+		rf: func(nh *NodeHost) {
+			if _, ok := nh.getShard(1); ok {
+				t.Fatalf("frozen replica started")
+			}
+			thaw(nh)
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestFreezingIdleShardsReleasesMemory(t *testing.T) {
+	fs := vfs.GetTestFS()
+	count := uint64(500)
+	heapAlloc := func() uint64 {
+		runtime.GC()
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		return ms.HeapAlloc
+	}
+	to := &testOption{
+		noElection: true,
+		tf: func(nh *NodeHost) {
+			createSM := func(uint64, uint64) sm.IStateMachine {
+				return &PST{}
+			}
+			for shardID := uint64(1); shardID <= count; shardID++ {
+				cfg := getTestConfig()
+				cfg.ShardID = shardID
+				members := map[uint64]string{1: nh.RaftAddress()}
+				if err := nh.StartReplica(members, false, createSM, *cfg); err != nil {
+					t.Fatalf("failed to start replica %v", err)
+				}
+			}
+			for shardID := uint64(1); shardID <= count; shardID++ {
+				waitForLeaderToBeElected(t, nh, shardID)
+			}
+			before := heapAlloc()
+			for shardID := uint64(1); shardID <= count; shardID++ {
+				ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+				if err := nh.FreezeShard(ctx, shardID); err != nil {
+					t.Fatalf("failed to freeze %v", err)
+				}
+				cancel()
+			}
+			after := heapAlloc()
+			t.Logf("heap allocated %d bytes before freezing, %d bytes after",
+				before, after)
+			if after >= before {
+				t.Errorf("no memory released, before %d, after %d", before, after)
+			}
+			if ci, ok := getFrozenTestShardInfo(nh, count); !ok || !ci.IsFrozen {
+				t.Errorf("unexpected shard info %+v", ci)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestFrozenReplicaIsThawedByLeaderHeartbeat(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		for _, nh := range nhs {
+			nh.nhConfig.AutoThaw = true
+		}
+		peers := make(map[uint64]string)
+		for i := range nhs {
+			peers[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		for i, nh := range nhs {
+			rc := getBootstrapTestConfig(uint64(i + 1))
+			rc.ShardID = 1
+			if err := nh.StartReplica(peers, false, newCloneTestSM, rc); err != nil {
+				t.Fatalf("failed to start replica %v", err)
+			}
+		}
+		for _, nh := range nhs {
+			waitForLeaderToBeElected(t, nh, 1)
+		}
+		leaderID, _, _, err := nhs[0].GetLeaderID(1)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		follower := nhs[leaderID%uint64(len(nhs))]
+		leader := nhs[leaderID-1]
+		ctx, cancel := context.WithTimeout(context.Background(), pto(follower))
+		defer cancel()
+		if err := follower.FreezeShard(ctx, 1); err != nil {
+			t.Fatalf("failed to freeze %v", err)
+		}
+		proposeCloneTestValue(t, leader, "k", 1)
+		leaderNode, ok := leader.getShard(1)
+		if !ok {
+			t.Fatalf("failed to get the leader node")
+		}
+		applied := leaderNode.sm.GetLastApplied()
+		// heartbeats sent by the leader wake up the frozen follower
+		for i := 0; ; i++ {
+			if i > 500 {
+				t.Fatalf("frozen replica not thawed")
+			}
+			if n, ok := follower.getShard(1); ok && n.initialized() &&
+				n.sm.GetLastApplied() >= applied {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if v := readCloneTestValue(t, follower, 1, "k"); v != "1" {
+			t.Errorf("unexpected value %s", v)
+		}
+		if ci, ok := getFrozenTestShardInfo(follower, 1); !ok || ci.IsFrozen {
+			t.Errorf("unexpected shard info %+v", ci)
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
+
+func TestRequestThawsFrozenReplica(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		createSM: newCloneTestSM,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.AutoThaw = true
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			proposeCloneTestValue(t, nh, "k", 1)
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			if err := nh.FreezeShard(ctx, 1); err != nil {
+				t.Fatalf("failed to freeze %v", err)
+			}
+			if _, err := nh.SyncRead(ctx, 1, "k"); !errors.Is(err, ErrShardNotReady) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			for i := 0; ; i++ {
+				if i > 500 {
+					t.Fatalf("frozen replica not thawed")
+				}
+				if v, err := nh.SyncRead(ctx, 1, "k"); err == nil {
+					if v.(string) != "1" {
+						t.Errorf("unexpected value %s", v)
+					}
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
@@ -0,0 +1,253 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/server"
+)
+
+const (
+	// applyStallElectionRTT is the number of election timeouts the apply loop
+	// is allowed to make no progress while there are committed entries to
+	// apply.
+	applyStallElectionRTT = 2
+	// healthCheckConcurrency is the maximum number of concurrent health checks
+	// performed by CheckAll.
+	healthCheckConcurrency = 8
+)
+
+var (
+	// ErrApplyStalled indicates that the state machine has not applied any
+	// committed entry for too long.
+	ErrApplyStalled = errors.New("apply loop stalled")
+	// ErrLeaderUnknown indicates that the leader of the shard is not known to
+	// the local replica.
+	ErrLeaderUnknown = errors.New("leader unknown")
+)
+
+// HealthLevel is the level of health checks performed by CheckHealth. Each
+// level includes all checks of the lower levels.
+type HealthLevel int
+
+const (
+	// HealthLocal checks that the local replica is running, its state machine
+	// is open and the apply loop is making progress when there are committed
+	// entries to apply.
+	HealthLocal HealthLevel = iota
+	// HealthLeaderful checks that the leader of the shard is known.
+	HealthLeaderful
+	// HealthLinearizable checks that a ReadIndex round can be completed before
+	// the specified context is done.
+	HealthLinearizable
+)
+
+var healthLevelNames = [...]string{
+	HealthLocal:        "Local",
+	HealthLeaderful:    "Leaderful",
+	HealthLinearizable: "Linearizable",
+}
+
+func (l HealthLevel) String() string {
+	if l < HealthLocal || l > HealthLinearizable {
+		return fmt.Sprintf("HealthLevel(%d)", int(l))
+	}
+	return healthLevelNames[l]
+}
+
+// HealthCheckError is the error returned when a replica fails a health check.
+// Level is the level of the criterion that failed, Err is the reason of the
+// failure.
+type HealthCheckError struct {
+	Err     error
+	ShardID uint64
+	Level   HealthLevel
+}
+
+func (e *HealthCheckError) Error() string {
+	return fmt.Sprintf("shard %d failed %s health check: %v",
+		e.ShardID, e.Level, e.Err)
+}
+
+// Unwrap returns the reason of the failure.
+func (e *HealthCheckError) Unwrap() error {
+	return e.Err
+}
+
+// CheckHealth checks whether the local replica of the specified shard is
+// healthy at the specified level. A *HealthCheckError explaining the failed
+// criterion is returned when the replica is not healthy.
+//
+// The apply loop is considered as stalled when committed entries have not
+// been applied for more than 2 election timeouts of the shard.
+func (nh *NodeHost) CheckHealth(ctx context.Context,
+	shardID uint64, level HealthLevel) error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	fail := func(l HealthLevel, err error) error {
+		return &HealthCheckError{Err: err, ShardID: shardID, Level: l}
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return fail(HealthLocal, ErrShardNotFound)
+	}
+	if err := n.checkLocalHealth(); err != nil {
+		return fail(HealthLocal, err)
+	}
+	if level == HealthLocal {
+		return nil
+	}
+	if _, _, ok := n.getLeaderID(); !ok {
+		return fail(HealthLeaderful, ErrLeaderUnknown)
+	}
+	if level == HealthLeaderful {
+		return nil
+	}
+	if _, err := nh.linearizableRead(ctx, shardID,
+		func(*node) (interface{}, error) { return nil, nil }); err != nil {
+		return fail(HealthLinearizable, err)
+	}
+	return nil
+}
+
+// CheckAll checks the health of all local replicas at the specified level, it
+// returns the results of CheckHealth keyed by shard ID. A nil map is returned
+// when the NodeHost has been closed.
+func (nh *NodeHost) CheckAll(ctx context.Context,
+	level HealthLevel) map[uint64]error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil
+	}
+	var shards []uint64
+	nh.forEachShard(func(shardID uint64, _ *node) bool {
+		shards = append(shards, shardID)
+		return true
+	})
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	result := make(map[uint64]error, len(shards))
+	sem := make(chan struct{}, healthCheckConcurrency)
+	for _, shardID := range shards {
+		shardID := shardID
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := nh.CheckHealth(ctx, shardID, level)
+			mu.Lock()
+			result[shardID] = err
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return result
+}
+
+func (n *node) checkLocalHealth() error {
+	if n.stopped() {
+		return ErrShardClosed
+	}
+	if !n.initialized() {
+		return ErrShardNotInitialized
+	}
+	select {
+	case <-n.sm.DestroyedC():
+		return ErrShardClosed
+	default:
+	}
+	n.raftMu.Lock()
+	defer n.raftMu.Unlock()
+	if n.currentTick-n.applyProgressTick >
+		applyStallElectionRTT*n.config.ElectionRTT {
+		return ErrApplyStalled
+	}
+	return nil
+}
+
+// trackApplyProgress records the tick and the time when the apply loop last
+// made progress or had nothing to apply. It is invoked on each tick with the
+// raftMu held, values read by other goroutines are updated atomically.
+func (n *node) trackApplyProgress() {
+	applied := n.sm.GetLastApplied()
+	committed := n.p.GetCommitted()
+	lag := uint64(0)
+	if committed > applied {
+		lag = committed - applied
+	}
+	atomic.StoreUint64(&n.applyLag, lag)
+	stalled := n.getApplyStallDuration()
+	progressed := applied != n.applyProgressIndex || lag == 0
+	if progressed {
+		n.applyProgressIndex = applied
+		n.applyProgressTick = n.currentTick
+		atomic.StoreInt64(&n.applyStallSince, 0)
+	}
+	if lag > 0 && atomic.LoadInt64(&n.applyStallSince) == 0 {
+		atomic.StoreInt64(&n.applyStallSince, time.Now().UnixNano())
+	}
+	n.notifyApplyStall(applied, lag, stalled, progressed)
+}
+
+// getApplyStallDuration returns the amount of time since the applied index
+// last advanced while there are committed entries to apply.
+func (n *node) getApplyStallDuration() time.Duration {
+	since := atomic.LoadInt64(&n.applyStallSince)
+	if since == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, since))
+}
+
+// notifyApplyStall publishes an ApplyStalled event when the stall duration
+// exceeds the configured threshold and an ApplyStallCleared event when the
+// applied index advances again after that.
+func (n *node) notifyApplyStall(applied uint64, lag uint64,
+	stalled time.Duration, progressed bool) {
+	if n.applyStallThreshold == 0 {
+		return
+	}
+	var et server.SystemEventType
+	if !n.applyStallReported && !progressed && stalled > n.applyStallThreshold {
+		n.applyStallReported = true
+		et = server.ApplyStalled
+		plog.Warningf("%s apply stalled for %s, index %d, lag %d",
+			n.id(), stalled, applied, lag)
+	} else if n.applyStallReported && progressed {
+		n.applyStallReported = false
+		et = server.ApplyStallCleared
+		plog.Infof("%s apply stall cleared, index %d", n.id(), applied)
+	} else {
+		return
+	}
+	n.sysEvents.Publish(server.SystemEvent{
+		Type:      et,
+		ShardID:   n.shardID,
+		ReplicaID: n.replicaID,
+		Index:     applied,
+		Lag:       lag,
+		Duration:  stalled,
+	})
+}
@@ -0,0 +1,225 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// blockingTestSM is a state machine whose Update blocks until unblocked when
+// the proposed command is "block".
+type blockingTestSM struct {
+	unblockC chan struct{}
+}
+
+func (s *blockingTestSM) Update(e sm.Entry) (sm.Result, error) {
+	if string(e.Cmd) == "block" {
+		<-s.unblockC
+	}
+	return sm.Result{}, nil
+}
+
+func (s *blockingTestSM) Lookup(query interface{}) (interface{}, error) {
+	return query, nil
+}
+
+func (s *blockingTestSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	return nil
+}
+
+func (s *blockingTestSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	return nil
+}
+
+func (s *blockingTestSM) Close() error { return nil }
+
+func checkHealthError(t *testing.T, err error, level HealthLevel, reason error) {
+	var he *HealthCheckError
+	if !errors.As(err, &he) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if he.Level != level || !errors.Is(err, reason) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestHealthyReplicaPassesAllHealthChecks(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			for _, level := range []HealthLevel{HealthLocal,
+				HealthLeaderful, HealthLinearizable} {
+				if err := nh.CheckHealth(ctx, 1, level); err != nil {
+					t.Errorf("%s health check failed, %v", level, err)
+				}
+			}
+			results := nh.CheckAll(ctx, HealthLinearizable)
+			if len(results) != 1 || results[1] != nil {
+				t.Errorf("unexpected results %v", results)
+			}
+			err := nh.CheckHealth(ctx, 2, HealthLocal)
+			checkHealthError(t, err, HealthLocal, ErrShardNotFound)
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestPartitionedReplicaFailsLeaderfulHealthCheck(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		// replica 2 is never started, replica 1 can not elect a leader
+		peers := map[uint64]string{1: nodeHostTestAddr1, 2: nodeHostTestAddr2}
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    1,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+		}
+		nh := startTestReplica(t, fs, rc, peers[1], peers, false, nil)
+		defer nh.Close()
+		// wait for a few election timeouts
+		time.Sleep(time.Duration(30*nh.nhConfig.RTTMillisecond) * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := nh.CheckHealth(ctx, 1, HealthLocal); err != nil {
+			t.Errorf("local health check failed, %v", err)
+		}
+		err := nh.CheckHealth(ctx, 1, HealthLeaderful)
+		checkHealthError(t, err, HealthLeaderful, ErrLeaderUnknown)
+		results := nh.CheckAll(ctx, HealthLinearizable)
+		checkHealthError(t, results[1], HealthLeaderful, ErrLeaderUnknown)
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
+func TestStalledStateMachineFailsLocalHealthCheck(t *testing.T) {
+	fs := vfs.GetTestFS()
+	unblockC := make(chan struct{})
+	to := &testOption{
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &blockingTestSM{unblockC: unblockC}
+		},
+		tf: func(nh *NodeHost) {
+			defer close(unblockC)
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			if err := nh.CheckHealth(ctx, 1, HealthLocal); err != nil {
+				t.Fatalf("local health check failed, %v", err)
+			}
+			session := nh.GetNoOPSession(1)
+			rs, err := nh.Propose(session, []byte("block"), pto(nh))
+			if err != nil {
+				t.Fatalf("failed to make proposal, %v", err)
+			}
+			defer rs.Release()
+			for i := 0; i < 200; i++ {
+				if err = nh.CheckHealth(ctx, 1, HealthLocal); err != nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			checkHealthError(t, err, HealthLocal, ErrApplyStalled)
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestApplyStallIsReported(t *testing.T) {
+	fs := vfs.GetTestFS()
+	unblockC := make(chan struct{})
+	var unblockOnce sync.Once
+	unblock := func() { unblockOnce.Do(func() { close(unblockC) }) }
+	to := &testOption{
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &blockingTestSM{unblockC: unblockC}
+		},
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.ApplyStallThreshold = 50 * time.Millisecond
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			defer unblock()
+			getShardInfo := func() ShardInfo {
+				nhi := nh.GetNodeHostInfo(NodeHostInfoOption{SkipLogInfo: true})
+				if len(nhi.ShardInfoList) != 1 {
+					t.Fatalf("unexpected shard info list %+v", nhi.ShardInfoList)
+				}
+				return nhi.ShardInfoList[0]
+			}
+			listener := nh.events.sys.ul.(*testSysEventListener)
+			session := nh.GetNoOPSession(1)
+			rs, err := nh.Propose(session, []byte("block"), pto(nh))
+			if err != nil {
+				t.Fatalf("failed to make proposal, %v", err)
+			}
+			defer rs.Release()
+			var stalled []raftio.ApplyStallInfo
+			for i := 0; i < 500; i++ {
+				if stalled, _ = listener.getApplyStallEvents(); len(stalled) > 0 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if len(stalled) != 1 {
+				t.Fatalf("unexpected ApplyStalled events %+v", stalled)
+			}
+			if stalled[0].ShardID != 1 || stalled[0].ReplicaID != 1 ||
+				stalled[0].Lag == 0 || stalled[0].Duration < 50*time.Millisecond {
+				t.Errorf("unexpected ApplyStalled event %+v", stalled[0])
+			}
+			si := getShardInfo()
+			if si.ApplyLag == 0 || si.ApplyStallDuration < 50*time.Millisecond {
+				t.Errorf("unexpected shard info %+v", si)
+			}
+			unblock()
+			var cleared []raftio.ApplyStallInfo
+			for i := 0; i < 500; i++ {
+				if _, cleared = listener.getApplyStallEvents(); len(cleared) > 0 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if len(cleared) != 1 || cleared[0].Duration < stalled[0].Duration {
+				t.Fatalf("unexpected ApplyStallCleared events %+v", cleared)
+			}
+			for i := 0; i < 500; i++ {
+				if si = getShardInfo(); si.ApplyLag == 0 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if si.ApplyLag != 0 || si.ApplyStallDuration != 0 {
+				t.Errorf("unexpected shard info %+v", si)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
@@ -0,0 +1,296 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// ReadAtSnapshot queries the state of the specified shard as of the retained
+// snapshot at snapshotIndex, it is intended for debugging purposes, e.g. to
+// find out what a key looked like in the past. A temporary state machine
+// instance is created using the specified factory and recovered from the
+// snapshot, the query is then passed to its Lookup method. Retained snapshots
+// of the local replica can be listed using the ListSnapshots method, see
+// config.Config.SnapshotsToKeep for details.
+//
+// The snapshot is pinned until the query completes, it is not removed even
+// when it is no longer retained in the meantime. When
+// config.NodeHostConfig.HistoricalReadCacheTTL is set, the materialized state
+// machine instance is cached for that duration so repeated queries at the
+// same snapshot don't recover it again.
+//
+// The factory is not required to create instances of the state machine type
+// used by the shard, e.g. state machine data saved by IOnDiskStateMachine
+// instances can be opened by an IStateMachine that provides read-only access
+// to the snapshot image and the external files it receives when recovering
+// from the snapshot. ErrNoSnapshot is returned when the snapshot is not on
+// disk. ErrInvalidOperation is returned when the snapshot contains no state
+// machine data, e.g. dummy snapshots of IOnDiskStateMachine based replicas.
+func (nh *NodeHost) ReadAtSnapshot(ctx context.Context, shardID uint64,
+	snapshotIndex uint64, factory sm.CreateStateMachineFunc,
+	query interface{}) (interface{}, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nil, ErrShardNotFound
+	}
+	key := historicalKey{
+		shardID:   shardID,
+		replicaID: n.replicaID,
+		index:     snapshotIndex,
+	}
+	h, ok := nh.historical.get(key)
+	if !ok {
+		if err := n.snapshotter.pin(snapshotIndex); err != nil {
+			return nil, err
+		}
+		defer n.snapshotter.unpin(snapshotIndex)
+		var err error
+		if h, err = materialize(ctx, n, key, factory, nh.fs); err != nil {
+			return nil, err
+		}
+		h = nh.historical.add(h, nh.nhConfig.HistoricalReadCacheTTL)
+	}
+	defer nh.historical.release(h)
+	return h.sm.Lookup(query)
+}
+
+// historicalKey identifies a state machine instance materialized from a
+// retained snapshot.
+type historicalKey struct {
+	shardID   uint64
+	replicaID uint64
+	index     uint64
+}
+
+// historicalSM is a state machine instance materialized from a retained
+// snapshot. It is closed once it is evicted from the cache and no longer
+// used by any query.
+type historicalSM struct {
+	key     historicalKey
+	sm      *rsm.StateMachine
+	stopc   chan struct{}
+	stopped sync.Once
+	timer   *time.Timer
+	refs    int
+	evicted bool
+}
+
+func (h *historicalSM) stop() {
+	h.stopped.Do(func() {
+		close(h.stopc)
+	})
+}
+
+func (h *historicalSM) close() {
+	h.stop()
+	if err := h.sm.Close(); err != nil {
+		plog.Errorf("failed to close the state machine at %s, %v",
+			dn(h.key.shardID, h.key.replicaID), err)
+	}
+}
+
+// materialize creates a new state machine instance recovered from the
+// retained snapshot specified by key, the snapshot must be pinned by the
+// caller. The returned instance has one reference.
+func materialize(ctx context.Context, n *node, key historicalKey,
+	factory sm.CreateStateMachineFunc, fs vfs.IFS) (*historicalSM, error) {
+	ss, err := n.snapshotter.getSnapshotMetadata(key.index)
+	if err != nil {
+		return nil, err
+	}
+	if ss.Dummy || ss.Witness {
+		return nil, errors.Wrapf(ErrInvalidOperation,
+			"%s contains no state machine data", n.snapshotter.ssid(key.index))
+	}
+	h := &historicalSM{
+		key:   key,
+		stopc: make(chan struct{}),
+		refs:  1,
+	}
+	cfg := config.Config{ShardID: key.shardID, ReplicaID: key.replicaID}
+	ds := rsm.NewNativeSM(cfg, rsm.NewInMemStateMachine(
+		factory(key.shardID, key.replicaID)), h.stopc)
+	ros := &historicalSnapshotter{snapshotter: n.snapshotter, ss: ss}
+	node := &readOnlyNode{
+		shardID:   key.shardID,
+		replicaID: key.replicaID,
+		stopc:     h.stopc,
+	}
+	h.sm = rsm.NewStateMachine(ds, ros, cfg, node, fs)
+	// the recovery is stopped once the context is done
+	donec := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			h.stop()
+		case <-donec:
+		}
+	}()
+	_, err = h.sm.Recover(rsm.Task{Recover: true, Initial: true})
+	close(donec)
+	if err != nil {
+		h.close()
+		if ctx.Err() != nil {
+			return nil, getContextError(ctx)
+		}
+		return nil, err
+	}
+	plog.Infof("%s materialized %s for historical reads",
+		dn(key.shardID, key.replicaID), n.snapshotter.ssid(key.index))
+	return h, nil
+}
+
+// historicalSnapshotter provides the retained snapshot to the state machine
+// being materialized.
+type historicalSnapshotter struct {
+	*snapshotter
+	ss pb.Snapshot
+}
+
+var _ rsm.ISnapshotter = (*historicalSnapshotter)(nil)
+
+func (s *historicalSnapshotter) GetSnapshot() (pb.Snapshot, error) {
+	return s.ss, nil
+}
+
+// getSnapshotMetadata returns the metadata of the snapshot at the specified
+// index, ErrInvalidOperation is returned when the snapshot has no metadata,
+// e.g. it was received from a remote replica running an older version of
+// Dragonboat.
+func (s *snapshotter) getSnapshotMetadata(index uint64) (pb.Snapshot, error) {
+	env := s.getEnv(index)
+	var ss pb.Snapshot
+	if err := fileutil.GetFlagFileContent(env.GetFinalDir(),
+		server.MetadataFilename, &ss, s.fs); err != nil {
+		if vfs.IsNotExist(err) {
+			return pb.Snapshot{}, errors.Wrapf(ErrInvalidOperation,
+				"%s has no metadata", s.ssid(index))
+		}
+		return pb.Snapshot{}, err
+	}
+	return ss, nil
+}
+
+// historicalCache caches state machine instances materialized by
+// ReadAtSnapshot.
+type historicalCache struct {
+	mu      sync.Mutex
+	entries map[historicalKey]*historicalSM
+	closed  bool
+}
+
+// get returns the cached instance with a new reference.
+func (c *historicalCache) get(key historicalKey) (*historicalSM, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	h.refs++
+	return h, true
+}
+
+// add caches the newly materialized instance for the specified duration, the
+// instance is not cached when ttl is 0. The cached instance already
+// materialized by a concurrent query is returned instead when there is one.
+func (c *historicalCache) add(h *historicalSM,
+	ttl time.Duration) *historicalSM {
+	c.mu.Lock()
+	if ttl == 0 || c.closed {
+		h.evicted = true
+		c.mu.Unlock()
+		return h
+	}
+	if cached, ok := c.entries[h.key]; ok {
+		cached.refs++
+		c.mu.Unlock()
+		h.close()
+		return cached
+	}
+	if c.entries == nil {
+		c.entries = make(map[historicalKey]*historicalSM)
+	}
+	c.entries[h.key] = h
+	h.timer = time.AfterFunc(ttl, func() {
+		c.evict(h)
+	})
+	c.mu.Unlock()
+	return h
+}
+
+// release releases a reference to the instance.
+func (c *historicalCache) release(h *historicalSM) {
+	c.mu.Lock()
+	h.refs--
+	closing := h.evicted && h.refs == 0
+	c.mu.Unlock()
+	if closing {
+		h.close()
+	}
+}
+
+func (c *historicalCache) evict(h *historicalSM) {
+	c.mu.Lock()
+	if h.evicted {
+		// already evicted when the cache was closed
+		c.mu.Unlock()
+		return
+	}
+	delete(c.entries, h.key)
+	h.evicted = true
+	closing := h.refs == 0
+	c.mu.Unlock()
+	if closing {
+		h.close()
+	}
+}
+
+// close evicts all cached instances, instances still used by queries are
+// closed once their queries complete.
+func (c *historicalCache) close() {
+	c.mu.Lock()
+	c.closed = true
+	var closing []*historicalSM
+	for key, h := range c.entries {
+		h.timer.Stop()
+		delete(c.entries, key)
+		h.evicted = true
+		if h.refs == 0 {
+			closing = append(closing, h)
+		}
+	}
+	c.mu.Unlock()
+	for _, h := range closing {
+		h.close()
+	}
+}
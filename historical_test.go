@@ -0,0 +1,214 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func proposeCloneTestValue(t *testing.T, nh *NodeHost, key string, value int) {
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+	defer cancel()
+	cmd := []byte(fmt.Sprintf("%s=%d", key, value))
+	if _, err := nh.SyncPropose(ctx, nh.GetNoOPSession(1), cmd); err != nil {
+		t.Fatalf("failed to make proposal, %v", err)
+	}
+}
+
+func readAtTestSnapshot(t *testing.T, nh *NodeHost, index uint64,
+	factory sm.CreateStateMachineFunc, key string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+	defer cancel()
+	v, err := nh.ReadAtSnapshot(ctx, 1, index, factory, key)
+	if err != nil {
+		t.Fatalf("failed to read at snapshot %d, %v", index, err)
+	}
+	return v.(string)
+}
+
+func TestReadAtSnapshotReturnsHistoricalValues(t *testing.T) {
+	fs := vfs.GetTestFS()
+	created := uint64(0)
+	factory := func(shardID uint64, replicaID uint64) sm.IStateMachine {
+		atomic.AddUint64(&created, 1)
+		return newCloneTestSM(shardID, replicaID)
+	}
+	to := &testOption{
+		createSM: newCloneTestSM,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.SnapshotsToKeep = 3
+			return c
+		},
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.HistoricalReadCacheTTL = time.Minute
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			values := make(map[uint64]string)
+			for i := 0; i < 3; i++ {
+				proposeCloneTestValue(t, nh, "k", i)
+				values[requestTestSnapshot(t, nh)] = fmt.Sprint(i)
+			}
+			proposeCloneTestValue(t, nh, "k", 3)
+			for index, value := range values {
+				for i := 0; i < 2; i++ {
+					if v := readAtTestSnapshot(t, nh, index, factory, "k"); v != value {
+						t.Errorf("snapshot %d, got %s, want %s", index, v, value)
+					}
+				}
+			}
+			// repeated reads are served by cached instances
+			if v := atomic.LoadUint64(&created); v != uint64(len(values)) {
+				t.Errorf("%d instances created, want %d", v, len(values))
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			if _, err := nh.ReadAtSnapshot(ctx, 1, 100000,
+				factory, "k"); !errors.Is(err, ErrNoSnapshot) {
+				t.Errorf("unexpected error %v", err)
+			}
+			if _, err := nh.ReadAtSnapshot(ctx, 2, 1,
+				factory, "k"); !errors.Is(err, ErrShardNotFound) {
+				t.Errorf("unexpected error %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+// blockingCloneTestSM is a cloneTestSM that blocks when recovering from a
+// snapshot until unblocked.
+type blockingCloneTestSM struct {
+	*cloneTestSM
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (s *blockingCloneTestSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	close(s.started)
+	<-s.unblock
+	return s.cloneTestSM.RecoverFromSnapshot(r, files, done)
+}
+
+func TestReadAtSnapshotPinsSnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	factory := func(shardID uint64, replicaID uint64) sm.IStateMachine {
+		return &blockingCloneTestSM{
+			cloneTestSM: newCloneTestSM(shardID, replicaID).(*cloneTestSM),
+			started:     started,
+			unblock:     unblock,
+		}
+	}
+	to := &testOption{
+		createSM: newCloneTestSM,
+		tf: func(nh *NodeHost) {
+			proposeCloneTestValue(t, nh, "k", 1)
+			index := requestTestSnapshot(t, nh)
+			type result struct {
+				v   interface{}
+				err error
+			}
+			resultC := make(chan result, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				defer cancel()
+				v, err := nh.ReadAtSnapshot(ctx, 1, index, factory, "k")
+				resultC <- result{v, err}
+			}()
+			<-started
+			proposeCloneTestValue(t, nh, "k", 2)
+			requestTestSnapshot(t, nh)
+			n, ok := nh.getShard(1)
+			if !ok {
+				t.Fatalf("failed to get node")
+			}
+			released := func() bool {
+				n.snapshotter.mu.Lock()
+				defer n.snapshotter.mu.Unlock()
+				_, ok := n.snapshotter.mu.released[index]
+				return ok
+			}
+			for i := 0; !released(); i++ {
+				if i > 500 {
+					t.Fatalf("snapshot %d not released", index)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			// the released snapshot is pinned by the historical read
+			env := n.snapshotter.getEnv(index)
+			if _, err := fs.Stat(env.GetFilepath()); err != nil {
+				t.Fatalf("pinned snapshot removed, %v", err)
+			}
+			close(unblock)
+			r := <-resultC
+			if r.err != nil || r.v.(string) != "1" {
+				t.Fatalf("unexpected result %v, %v", r.v, r.err)
+			}
+			if _, err := fs.Stat(env.GetFilepath()); !vfs.IsNotExist(err) {
+				t.Errorf("unpinned snapshot not removed, %v", err)
+			}
+			// the instance is not cached by default
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			if _, err := nh.ReadAtSnapshot(ctx, 1, index,
+				factory, "k"); !errors.Is(err, ErrNoSnapshot) {
+				t.Errorf("unexpected error %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestSnapshotterDoesNotRemovePinnedSnapshots(t *testing.T) {
+	fs := vfs.GetTestFS()
+	fn := func(t *testing.T, ldb raftio.ILogDB, s *snapshotter) {
+		for i := uint64(1); i <= 2; i++ {
+			commitTestSnapshot(t, s, i*100)
+		}
+		if err := s.pin(100); err != nil {
+			t.Fatalf("failed to pin %v", err)
+		}
+		if err := s.pin(100); err != nil {
+			t.Fatalf("failed to pin %v", err)
+		}
+		if err := s.pin(300); !errors.Is(err, ErrNoSnapshot) {
+			t.Errorf("unexpected error %v", err)
+		}
+		if err := s.Compact(100); err != nil {
+			t.Fatalf("compact failed %v", err)
+		}
+		checkTestSnapshotIndexes(t, s, []uint64{200, 100})
+		s.unpin(100)
+		checkTestSnapshotIndexes(t, s, []uint64{200, 100})
+		s.unpin(100)
+		checkTestSnapshotIndexes(t, s, []uint64{200})
+	}
+	runSnapshotterTest(t, fn, fs)
+}
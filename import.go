@@ -0,0 +1,238 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/importer"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+)
+
+var (
+	// ErrReplicaStateExist indicates that the Raft log, state or snapshots of
+	// the replica already exist on the NodeHost.
+	ErrReplicaStateExist = errors.New("replica state already exists")
+	// ErrInvalidSnapshotArchive indicates that the snapshot archive is corrupted
+	// or is not in a supported format.
+	ErrInvalidSnapshotArchive = importer.ErrInvalidArchive
+)
+
+// SnapshotSource provides the files of an exported snapshot to be imported by
+// NodeHost.ImportSnapshot. Files are opened using their names in the exported
+// snapshot directory, i.e. snapshot.metadata, snapshot-XXXXXXXXXXXXXXXX.gbsnap
+// and external-file-N files, see ExportSink for details.
+type SnapshotSource interface {
+	Open(name string) (io.ReadCloser, error)
+}
+
+// NewDirSnapshotSource returns a SnapshotSource providing the files of the
+// exported snapshot in the specified snapshot-XXXXXXXXXXXXXXXX directory. The
+// default filesystem is used when fs is nil.
+func NewDirSnapshotSource(dir string, fs config.IFS) SnapshotSource {
+	if fs == nil {
+		fs = vfs.DefaultFS
+	}
+	return importer.NewDirSource(dir, fs)
+}
+
+// NewArchiveSnapshotSource returns a SnapshotSource providing the files of the
+// exported snapshot stored in the snapshot archive read from r, see
+// NewArchiveExportSink for details. The manifest of the archive is read and
+// validated before NewArchiveSnapshotSource returns, ErrInvalidSnapshotArchive
+// is returned when it is corrupted. The rest of the archive is read
+// sequentially as its files are imported, a file that fails its checksum check
+// fails the import with ErrInvalidSnapshotArchive. The returned SnapshotSource
+// can only be used by a single import.
+func NewArchiveSnapshotSource(r io.Reader) (SnapshotSource, error) {
+	return importer.NewArchiveSource(r)
+}
+
+// ImportOption is the option type used by ImportSnapshotWithOption.
+type ImportOption struct {
+	// Overwrite determines whether existing state of the replica, e.g. its Raft
+	// log and snapshots left by a previous run, should be overwritten by the
+	// imported snapshot. ErrReplicaStateExist is returned when such state exists
+	// and Overwrite is not set.
+	Overwrite bool
+	// Clone allows the snapshot exported by another shard to be imported, the
+	// specified shard becomes a clone of that shard at the index of the
+	// snapshot. The shard ID and the membership recorded in the snapshot are
+	// rewritten to the specified shard ID and members, the membership of the
+	// source shard is not checked as the clone shares no history with it. The
+	// state machine payload is imported as is. Client sessions saved in the
+	// snapshot are preserved unless StripSessions is set, clients of the
+	// source shard should not be used with the clone in such case as their
+	// sessions are unknown to the source shard from then on.
+	Clone bool
+	// StripSessions indicates whether client sessions saved in the snapshot
+	// should be removed during the import.
+	StripSessions bool
+}
+
+// contextSource is a SnapshotSource that stops providing files once the
+// context is done.
+type contextSource struct {
+	ctx context.Context
+	src SnapshotSource
+}
+
+func (s *contextSource) Open(name string) (io.ReadCloser, error) {
+	if s.ctx.Err() != nil {
+		return nil, getContextError(s.ctx)
+	}
+	return s.src.Open(name)
+}
+
+// ImportSnapshot imports the exported snapshot provided by source as the
+// snapshot of the specified replica on the running NodeHost, it is the online
+// version of the ImportSnapshot function in the tools package. The membership
+// of the shard is rewritten to the specified members, the replica can be
+// started using StartReplica, StartConcurrentReplica or StartOnDiskReplica
+// with empty initial members once the snapshot is imported, e.g. to restore a
+// shard that permanently lost its quorum. See the ImportSnapshot function in
+// the tools package for details on how members should be specified.
+//
+// The replica must not be running on the NodeHost. ErrReplicaStateExist is
+// returned when the state of the replica already exists on the NodeHost, see
+// ImportSnapshotWithOption for overwriting such state.
+func (nh *NodeHost) ImportSnapshot(ctx context.Context,
+	shardID uint64, replicaID uint64, source SnapshotSource,
+	members map[uint64]string) error {
+	return nh.ImportSnapshotWithOption(ctx,
+		shardID, replicaID, source, members, ImportOption{})
+}
+
+// ImportSnapshotWithOption is similar to ImportSnapshot, it allows the caller
+// to specify the ImportOption.
+func (nh *NodeHost) ImportSnapshotWithOption(ctx context.Context,
+	shardID uint64, replicaID uint64, source SnapshotSource,
+	members map[uint64]string, opt ImportOption) error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	if err := nh.checkImportMembers(replicaID, members); err != nil {
+		return err
+	}
+	src := &contextSource{ctx: ctx, src: source}
+	ss, err := importer.GetSnapshotRecord(src)
+	if err != nil {
+		return err
+	}
+	if ss.ShardID != shardID && !opt.Clone {
+		plog.Errorf("snapshot of shard %d can not be imported to shard %d",
+			ss.ShardID, shardID)
+		return ErrInvalidOption
+	}
+	if !opt.Clone {
+		if err := importer.CheckMembers(ss.Membership, members); err != nil {
+			return err
+		}
+	}
+	// prevents the replica from being concurrently started
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	if _, ok := nh.mu.shards.Load(shardID); ok {
+		return ErrShardAlreadyExist
+	}
+	if nh.engine.nodeLoaded(shardID, replicaID) {
+		return ErrShardAlreadyExist
+	}
+	did := nh.nhConfig.GetDeploymentID()
+	ssDir := nh.env.GetSnapshotDir(did, shardID, replicaID)
+	exist, err := nh.hasReplicaState(shardID, replicaID, ssDir)
+	if err != nil {
+		return err
+	}
+	if exist && !opt.Overwrite {
+		return ErrReplicaStateExist
+	}
+	if err := nh.env.CreateSnapshotDir(did, shardID, replicaID); err != nil {
+		return err
+	}
+	if err := importer.CleanupSnapshotDir(ssDir, nh.fs); err != nil {
+		return err
+	}
+	getSnapshotDir := func(cid uint64, nid uint64) string {
+		return nh.env.GetSnapshotDir(did, cid, nid)
+	}
+	iopts := importer.Options{
+		ShardID:       shardID,
+		StripSessions: opt.StripSessions,
+	}
+	if err := importer.Install(nh.mu.logdb,
+		getSnapshotDir, ss, src, members, replicaID, iopts, nh.fs); err != nil {
+		return err
+	}
+	plog.Infof("imported snapshot %d of %s as %s",
+		ss.Index, dn(ss.ShardID, replicaID), dn(shardID, replicaID))
+	return nil
+}
+
+func (nh *NodeHost) checkImportMembers(replicaID uint64,
+	members map[uint64]string) error {
+	validator := nh.nhConfig.GetTargetValidator()
+	for _, target := range members {
+		if !validator(target) {
+			return ErrInvalidTarget
+		}
+	}
+	local := nh.RaftAddress()
+	if nh.nhConfig.NodeRegistryEnabled() {
+		local = nh.ID()
+	}
+	if target, ok := members[replicaID]; !ok || target != local {
+		plog.Errorf("replica %d not in members or not on this NodeHost",
+			replicaID)
+		return ErrInvalidOption
+	}
+	return nil
+}
+
+// hasReplicaState returns a boolean value indicating whether the bootstrap
+// record or the snapshot directory of the replica exists. ErrReplicaRemoved is
+// returned when the replica has been removed by RemoveData.
+func (nh *NodeHost) hasReplicaState(shardID uint64,
+	replicaID uint64, ssDir string) (bool, error) {
+	_, err := nh.mu.logdb.GetBootstrapInfo(shardID, replicaID)
+	if err != nil && !errors.Is(err, raftio.ErrNoBootstrapInfo) {
+		return false, err
+	}
+	hasBootstrap := err == nil
+	exist, err := fileutil.Exist(ssDir, nh.fs)
+	if err != nil {
+		return false, err
+	}
+	if exist {
+		removed, err := fileutil.IsDirMarkedAsDeleted(ssDir, nh.fs)
+		if err != nil {
+			return false, err
+		}
+		if removed {
+			return false, ErrReplicaRemoved
+		}
+	}
+	return hasBootstrap || exist, nil
+}
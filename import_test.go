@@ -0,0 +1,430 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/tests"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+	"github.com/lni/dragonboat/v4/tools"
+)
+
+// memSnapshotSource provides the files of a snapshot exported to a
+// memExportSink.
+type memSnapshotSource struct {
+	sink *memExportSink
+	dir  string
+}
+
+func (s *memSnapshotSource) Open(name string) (io.ReadCloser, error) {
+	data, ok := s.sink.committed[s.dir+"/"+name]
+	if !ok {
+		return nil, errors.Newf("%s not found", name)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func startSimDiskShard(t *testing.T, nhs []*NodeHost,
+	initialMembers map[uint64]string, applied uint64) {
+	for i, nh := range nhs {
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    uint64(i + 1),
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
+		}
+		createSM := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return tests.NewSimDiskSM(applied)
+		}
+		if err := nh.StartOnDiskReplica(initialMembers,
+			false, createSM, rc); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+	}
+	for _, nh := range nhs {
+		waitForLeaderToBeElected(t, nh, 1)
+	}
+}
+
+func readSimDiskApplied(t *testing.T, nh *NodeHost) uint64 {
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+	defer cancel()
+	rv, err := nh.SyncRead(ctx, 1, nil)
+	if err != nil {
+		t.Fatalf("failed to read %v", err)
+	}
+	return rv.(uint64)
+}
+
+func importTestSnapshot(nh *NodeHost, replicaID uint64,
+	src SnapshotSource, members map[uint64]string, opt ImportOption) error {
+	for i := 0; i < 500; i++ {
+		err := nh.ImportSnapshotWithOption(context.Background(),
+			1, replicaID, src, members, opt)
+		if !errors.Is(err, ErrShardAlreadyExist) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return ErrShardAlreadyExist
+}
+
+func TestShardCanBeRestoredFromImportedSnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := make(map[uint64]string)
+		for i := range nhs {
+			members[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		startSimDiskShard(t, nhs, members, 0)
+		proposeTestData(t, nhs[0], "exported", 5)
+		sink := newMemExportSink()
+		index, err := exportTestSnapshot(nhs[0], sink)
+		if err != nil {
+			t.Fatalf("failed to export snapshot %v", err)
+		}
+		proposeTestData(t, nhs[0], "lost", 5)
+		applied := readSimDiskApplied(t, nhs[0])
+		if applied <= index {
+			t.Fatalf("unexpected applied index %d", applied)
+		}
+		for _, nh := range nhs {
+			if err := nh.StopShard(1); err != nil {
+				t.Fatalf("failed to stop shard %v", err)
+			}
+		}
+		src := &memSnapshotSource{sink: sink, dir: server.GetSnapshotDirName(index)}
+		for i, nh := range nhs {
+			replicaID := uint64(i + 1)
+			if err := importTestSnapshot(nh, replicaID,
+				src, members, ImportOption{}); !errors.Is(err, ErrReplicaStateExist) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err := importTestSnapshot(nh, replicaID,
+				src, members, ImportOption{Overwrite: true}); err != nil {
+				t.Fatalf("failed to import snapshot %v", err)
+			}
+		}
+		startSimDiskShard(t, nhs, nil, applied)
+		for _, nh := range nhs {
+			if rv := readSimDiskApplied(t, nh); rv != index {
+				t.Errorf("unexpected applied index %d, want %d", rv, index)
+			}
+		}
+		proposeTestData(t, nhs[1], "restored", 5)
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
+
+func TestImportSnapshotSafetyChecks(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			proposeTestData(t, nh, "exported", 5)
+			sink := newMemExportSink()
+			index, err := exportTestSnapshot(nh, sink)
+			if err != nil {
+				t.Fatalf("failed to export snapshot %v", err)
+			}
+			src := &memSnapshotSource{sink: sink, dir: server.GetSnapshotDirName(index)}
+			members := map[uint64]string{1: nh.RaftAddress()}
+			ctx := context.Background()
+			if err := nh.ImportSnapshot(ctx,
+				1, 1, src, members); !errors.Is(err, ErrShardAlreadyExist) {
+				t.Errorf("unexpected error %v", err)
+			}
+			invalid := []struct {
+				shardID uint64
+				members map[uint64]string
+			}{
+				{2, map[uint64]string{1: nh.RaftAddress()}},
+				{2, map[uint64]string{2: nh.RaftAddress()}},
+				{1, map[uint64]string{1: "localhost:1"}},
+			}
+			for idx, tt := range invalid {
+				err := nh.ImportSnapshot(ctx, tt.shardID, 1, src, tt.members)
+				if !errors.Is(err, ErrInvalidOption) {
+					t.Errorf("%d, unexpected error %v", idx, err)
+				}
+			}
+			cctx, cancel := context.WithCancel(ctx)
+			cancel()
+			if err := nh.ImportSnapshot(cctx,
+				1, 1, src, members); !errors.Is(err, ErrCanceled) {
+				t.Errorf("unexpected error %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+// cloneTestSM is a key-value state machine, keys and values are proposed in
+// the key=value format.
+type cloneTestSM struct {
+	kv map[string]string
+}
+
+func newCloneTestSM(uint64, uint64) sm.IStateMachine {
+	return &cloneTestSM{kv: make(map[string]string)}
+}
+
+func (s *cloneTestSM) Update(e sm.Entry) (sm.Result, error) {
+	parts := strings.SplitN(string(e.Cmd), "=", 2)
+	if len(parts) == 2 {
+		s.kv[parts[0]] = parts[1]
+	}
+	return sm.Result{Value: uint64(len(e.Cmd))}, nil
+}
+
+func (s *cloneTestSM) Lookup(key interface{}) (interface{}, error) {
+	return s.kv[key.(string)], nil
+}
+
+func (s *cloneTestSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	return json.NewEncoder(w).Encode(s.kv)
+}
+
+func (s *cloneTestSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	return json.NewDecoder(r).Decode(&s.kv)
+}
+
+func (s *cloneTestSM) Close() error { return nil }
+
+func startCloneTestShard(t *testing.T, nhs []*NodeHost, shardID uint64,
+	replicaIDs []uint64, initialMembers map[uint64]string) {
+	for i, nh := range nhs {
+		rc := config.Config{
+			ShardID:      shardID,
+			ReplicaID:    replicaIDs[i],
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
+		}
+		if err := nh.StartReplica(initialMembers,
+			false, newCloneTestSM, rc); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+	}
+	for _, nh := range nhs {
+		waitForLeaderToBeElected(t, nh, shardID)
+	}
+}
+
+func readCloneTestValue(t *testing.T,
+	nh *NodeHost, shardID uint64, key string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+	defer cancel()
+	rv, err := nh.SyncRead(ctx, shardID, key)
+	if err != nil {
+		t.Fatalf("failed to read %v", err)
+	}
+	return rv.(string)
+}
+
+func TestShardCanBeCloned(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := make(map[uint64]string)
+		for i := 0; i < 3; i++ {
+			members[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		startCloneTestShard(t, nhs[:3], 1, []uint64{1, 2, 3}, members)
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(nhs[0]))
+		defer cancel()
+		session, err := nhs[0].SyncGetSession(ctx, 1)
+		if err != nil {
+			t.Fatalf("failed to get session %v", err)
+		}
+		for _, cmd := range []string{"a=1", "b=2"} {
+			if _, err := nhs[0].SyncPropose(ctx, session, []byte(cmd)); err != nil {
+				t.Fatalf("failed to propose %v", err)
+			}
+			session.ProposalCompleted()
+		}
+		sink := newMemExportSink()
+		index, err := exportTestSnapshot(nhs[0], sink)
+		if err != nil {
+			t.Fatalf("failed to export snapshot %v", err)
+		}
+		if _, err := nhs[0].SyncPropose(ctx,
+			nhs[0].GetNoOPSession(1), []byte("c=3")); err != nil {
+			t.Fatalf("failed to propose %v", err)
+		}
+		src := &memSnapshotSource{sink: sink, dir: server.GetSnapshotDirName(index)}
+		clones := []struct {
+			shardID       uint64
+			replicaIDs    []uint64
+			stripSessions bool
+		}{
+			{9999, []uint64{4, 5, 6}, false},
+			{9998, []uint64{1, 2, 3}, true},
+		}
+		for _, c := range clones {
+			cloneMembers := make(map[uint64]string)
+			for i, replicaID := range c.replicaIDs {
+				cloneMembers[replicaID] = memtransport.Address(i + 4)
+			}
+			opt := ImportOption{Clone: true, StripSessions: c.stripSessions}
+			for i, nh := range nhs[3:] {
+				if err := nh.ImportSnapshotWithOption(ctx, c.shardID,
+					c.replicaIDs[i], src, cloneMembers, opt); err != nil {
+					t.Fatalf("failed to import snapshot %v", err)
+				}
+			}
+			startCloneTestShard(t, nhs[3:], c.shardID, c.replicaIDs, nil)
+			for _, nh := range nhs[3:] {
+				m, err := nh.SyncGetShardMembership(ctx, c.shardID)
+				if err != nil {
+					t.Fatalf("failed to get membership %v", err)
+				}
+				if len(m.Nodes) != 3 || len(m.Removed) != 0 {
+					t.Errorf("unexpected membership %+v", m)
+				}
+				for key, want := range map[string]string{"a": "1", "b": "2", "c": ""} {
+					if v := readCloneTestValue(t, nh, c.shardID, key); v != want {
+						t.Errorf("key %s, value %s, want %s", key, v, want)
+					}
+				}
+			}
+			// the session registered on the source shard
+			cs := *session
+			cs.ShardID = c.shardID
+			_, err := nhs[3].SyncPropose(ctx, &cs, []byte("d=4"))
+			if c.stripSessions {
+				if !errors.Is(err, ErrRejected) {
+					t.Errorf("unexpected error %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("failed to propose %v", err)
+			}
+		}
+		// the source shard is not affected
+		if v := readCloneTestValue(t, nhs[0], 1, "c"); v != "3" {
+			t.Errorf("unexpected value %s", v)
+		}
+	}
+	memTransportNodeHostTest(t, 6, tf, fs)
+}
+
+func TestQuorumLostShardCanBeUnsafelyRecovered(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := make(map[uint64]string)
+		for i := range nhs {
+			members[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		startCloneTestShard(t, nhs, 1, []uint64{1, 2, 3}, members)
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(nhs[0]))
+		defer cancel()
+		for _, cmd := range []string{"a=1", "b=2"} {
+			if _, err := nhs[0].SyncPropose(ctx,
+				nhs[0].GetNoOPSession(1), []byte(cmd)); err != nil {
+				t.Fatalf("failed to propose %v", err)
+			}
+		}
+		// replicas 2 and 3 are permanently lost
+		for _, nh := range nhs[1:] {
+			if err := nh.StopShard(1); err != nil {
+				t.Fatalf("failed to stop shard %v", err)
+			}
+		}
+		recovered := map[uint64]string{1: memtransport.Address(1)}
+		nhc := nhs[0].NodeHostConfig()
+		nhs[0].Close()
+		if err := tools.UnsafeRecoverMembership(nhc, 1, 1,
+			map[uint64]string{1: memtransport.Address(1), 2: "invalid"}); !errors.Is(err,
+			tools.ErrInvalidRecoveryMembers) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if err := tools.UnsafeRecoverMembership(nhc, 1, 1, recovered); err != nil {
+			t.Fatalf("failed to recover membership %v", err)
+		}
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			t.Fatalf("failed to create nodehost %v", err)
+		}
+		// closed by memTransportNodeHostTest
+		nhs[0] = nh
+		startCloneTestShard(t, nhs[:1], 1, []uint64{1}, nil)
+		for key, want := range map[string]string{"a": "1", "b": "2"} {
+			if v := readCloneTestValue(t, nh, 1, key); v != want {
+				t.Errorf("key %s, value %s, want %s", key, v, want)
+			}
+		}
+		d, err := nh.DumpRaftState(context.Background(), 1)
+		if err != nil {
+			t.Fatalf("failed to dump raft state %v", err)
+		}
+		if r := d.UnsafeRecovery; r.Count != 1 || r.Index == 0 || r.Time == 0 {
+			t.Errorf("unexpected recovery dump %+v", r)
+		}
+		// new nodes can be added normally
+		if err := nh.SyncRequestAddReplica(ctx,
+			1, 4, memtransport.Address(2), 0); err != nil {
+			t.Fatalf("failed to add replica %v", err)
+		}
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    4,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
+		}
+		if err := nhs[1].StartReplica(nil, true, newCloneTestSM, rc); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+		// proposals can be dropped or time out before replica 4 catches up
+		for i := 0; ; i++ {
+			pctx, pcancel := context.WithTimeout(context.Background(), pto(nh))
+			_, err := nh.SyncPropose(pctx, nh.GetNoOPSession(1), []byte("c=3"))
+			pcancel()
+			if err == nil {
+				break
+			}
+			if (!errors.Is(err, ErrTimeout) &&
+				!errors.Is(err, ErrShardNotReady)) || i > 100 {
+				t.Fatalf("failed to propose %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		for i := 0; ; i++ {
+			if v, err := nhs[1].StaleRead(1, "c"); err == nil && v.(string) == "3" {
+				break
+			}
+			if i > 500 {
+				t.Fatalf("replica 4 failed to catch up")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
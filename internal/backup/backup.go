@@ -0,0 +1,411 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package backup implements the format of NodeHost backups. It is shared by the
+Backup method of NodeHost and the offline RestoreNodeHost function in the
+tools package.
+
+This package is internally used by Dragonboat, applications are not expected to
+import this package.
+*/
+package backup
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/importer"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/utils"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	// Version is the version of the backup format.
+	Version uint32 = 1
+	// ManifestFilename is the name of the manifest file, it is always the last
+	// file written to the backup.
+	ManifestFilename = "MANIFEST"
+	// entriesFilename is the name of the file holding the Raft log entries of
+	// a replica.
+	entriesFilename = "entries"
+	// maxEntrySize is the max size of a single entry record accepted.
+	maxEntrySize = 1024 * 1024 * 1024
+	// restoreBatchSize is the max number of entries saved to the LogDB in a
+	// single batch when restoring a replica.
+	restoreBatchSize = 1024
+)
+
+var (
+	// ErrInvalidBackup indicates that the backup is corrupted or not in a
+	// supported format.
+	ErrInvalidBackup = errors.New("invalid backup")
+)
+
+var firstError = utils.FirstError
+
+// File describes a file stored in the backup.
+type File struct {
+	// Name is the slash separated path of the file relative to the backup.
+	Name string `json:"name"`
+	// Size is the size of the file in bytes.
+	Size uint64 `json:"size"`
+	// SHA256 is the hex encoded SHA-256 digest of the file content.
+	SHA256 string `json:"sha256"`
+}
+
+// Replica describes the backup of a replica. Bootstrap, State and Snapshot are
+// the marshaled bootstrap record, Raft state and snapshot record of the
+// replica. File paths of the snapshot record are names of the snapshot files
+// in the backup, all of them are listed in SnapshotFiles. Entries holds the
+// Raft log entries between FirstIndex and LastIndex, both inclusive, it is
+// empty when there is no entry after the snapshot.
+type Replica struct {
+	ShardID       uint64 `json:"shard_id"`
+	ReplicaID     uint64 `json:"replica_id"`
+	Bootstrap     []byte `json:"bootstrap"`
+	State         []byte `json:"state"`
+	Snapshot      []byte `json:"snapshot"`
+	SnapshotFiles []File `json:"snapshot_files"`
+	Entries       File   `json:"entries"`
+	FirstIndex    uint64 `json:"first_index"`
+	LastIndex     uint64 `json:"last_index"`
+}
+
+// Manifest is the JSON encoded content of the manifest file of the backup.
+// Checksum is the hex encoded SHA-256 digest of the JSON encoded manifest with
+// Checksum set to empty.
+type Manifest struct {
+	Version      uint32    `json:"version"`
+	NodeHostID   string    `json:"nodehost_id"`
+	RaftAddress  string    `json:"raft_address"`
+	DeploymentID uint64    `json:"deployment_id"`
+	Time         int64     `json:"time"`
+	Replicas     []Replica `json:"replicas"`
+	Checksum     string    `json:"checksum"`
+}
+
+func (m Manifest) checksum() (string, error) {
+	m.Checksum = ""
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// MarshalManifest returns the JSON encoded manifest, its version and checksum
+// are set by MarshalManifest.
+func MarshalManifest(m Manifest) ([]byte, error) {
+	m.Version = Version
+	checksum, err := m.checksum()
+	if err != nil {
+		return nil, err
+	}
+	m.Checksum = checksum
+	return json.Marshal(m)
+}
+
+// GetManifest reads and validates the manifest of the backup provided by src.
+func GetManifest(src importer.ISource) (m Manifest, err error) {
+	f, err := src.Open(ManifestFilename)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer func() {
+		err = firstError(err, f.Close())
+	}()
+	data, err := fileutil.ReadAll(f)
+	if err != nil {
+		return Manifest{}, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Manifest{}, errors.Wrap(ErrInvalidBackup, err.Error())
+	}
+	checksum, err := m.checksum()
+	if err != nil {
+		return Manifest{}, err
+	}
+	if checksum != m.Checksum {
+		return Manifest{}, errors.Wrap(ErrInvalidBackup, "manifest checksum")
+	}
+	if m.Version != Version {
+		return Manifest{}, errors.Wrapf(ErrInvalidBackup,
+			"unsupported version %d", m.Version)
+	}
+	return m, nil
+}
+
+// GetReplicaDir returns the slash separated directory of the specified replica
+// in the backup.
+func GetReplicaDir(shardID uint64, replicaID uint64) string {
+	return fmt.Sprintf("shard-%d-replica-%d", shardID, replicaID)
+}
+
+// GetEntriesFilename returns the name of the file holding Raft log entries of
+// the specified replica in the backup.
+func GetEntriesFilename(shardID uint64, replicaID uint64) string {
+	return path.Join(GetReplicaDir(shardID, replicaID), entriesFilename)
+}
+
+// Writer is an io.WriteCloser that records the size and the digest of the
+// content written to the backup file.
+type Writer struct {
+	io.WriteCloser
+	h    hash.Hash
+	name string
+	size uint64
+}
+
+// NewWriter returns a Writer writing the named backup file to w.
+func NewWriter(name string, w io.WriteCloser) *Writer {
+	return &Writer{WriteCloser: w, name: name, h: sha256.New()}
+}
+
+// Write writes p to the backup file.
+func (w *Writer) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.h.Write(p[:n])
+	w.size += uint64(n)
+	return n, err
+}
+
+// File returns the description of the written backup file.
+func (w *Writer) File() File {
+	return File{
+		Name:   w.name,
+		Size:   w.size,
+		SHA256: hex.EncodeToString(w.h.Sum(nil)),
+	}
+}
+
+// WriteEntries appends entries to w, each entry is written as its uvarint
+// encoded size followed by the marshaled entry.
+func WriteEntries(w io.Writer, entries []pb.Entry) error {
+	var sz [binary.MaxVarintLen64]byte
+	for i := range entries {
+		data := pb.MustMarshal(&entries[i])
+		n := binary.PutUvarint(sz[:], uint64(len(data)))
+		if _, err := w.Write(sz[:n]); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reader is an io.Reader that checks the size and the digest of the content
+// read from the backup file once EOF is reached.
+type reader struct {
+	r    io.Reader
+	h    hash.Hash
+	file File
+	size uint64
+}
+
+func newReader(r io.Reader, file File) *reader {
+	return &reader{r: r, h: sha256.New(), file: file}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	r.size += uint64(n)
+	if err == io.EOF {
+		if r.size != r.file.Size ||
+			hex.EncodeToString(r.h.Sum(nil)) != r.file.SHA256 {
+			return n, errors.Wrapf(ErrInvalidBackup, "%s checksum", r.file.Name)
+		}
+	}
+	return n, err
+}
+
+// Install restores the replica described by r from the backup provided by src.
+// Snapshot files are copied to the snapshot directory returned by
+// getSnapshotDir, which must exist, records of the replica are saved to ldb
+// using the LogDB worker workerID assigned to the shard. The content of each file is checked against its digest found in the
+// manifest.
+func Install(ldb raftio.ILogDB, getSnapshotDir server.SnapshotDirFunc,
+	r Replica, src importer.ISource, workerID uint64, fs vfs.IFS) error {
+	var bs pb.Bootstrap
+	var st pb.State
+	var ss pb.Snapshot
+	if err := unmarshal(r.Bootstrap, &bs); err != nil {
+		return err
+	}
+	if err := unmarshal(r.State, &st); err != nil {
+		return err
+	}
+	if err := unmarshal(r.Snapshot, &ss); err != nil {
+		return err
+	}
+	if ss.Index > 0 && !ss.Witness && !ss.Dummy {
+		var err error
+		if ss, err = installSnapshot(getSnapshotDir, r, ss, src, fs); err != nil {
+			return err
+		}
+	}
+	if err := ldb.SaveBootstrapInfo(r.ShardID, r.ReplicaID, bs); err != nil {
+		return err
+	}
+	update := pb.Update{
+		ShardID:   r.ShardID,
+		ReplicaID: r.ReplicaID,
+		State:     st,
+		Snapshot:  ss,
+	}
+	if err := ldb.SaveRaftState([]pb.Update{update}, workerID); err != nil {
+		return err
+	}
+	if r.LastIndex < r.FirstIndex {
+		return nil
+	}
+	return installEntries(ldb, r, src, workerID)
+}
+
+func unmarshal(data []byte, m pb.Unmarshaler) error {
+	if err := m.Unmarshal(data); err != nil {
+		return errors.Wrap(ErrInvalidBackup, err.Error())
+	}
+	return nil
+}
+
+func installSnapshot(getSnapshotDir server.SnapshotDirFunc,
+	r Replica, ss pb.Snapshot, src importer.ISource,
+	fs vfs.IFS) (pb.Snapshot, error) {
+	ssEnv := server.NewSSEnv(getSnapshotDir, r.ShardID,
+		r.ReplicaID, ss.Index, r.ReplicaID, server.SnapshotMode, fs)
+	if err := ssEnv.CreateTempDir(); err != nil {
+		return pb.Snapshot{}, err
+	}
+	dstDir := ssEnv.GetTempDir()
+	for _, file := range r.SnapshotFiles {
+		dst := fs.PathJoin(dstDir, path.Base(file.Name))
+		if err := copyFile(src, file, dst, fs); err != nil {
+			return pb.Snapshot{}, firstError(err, ssEnv.RemoveTempDir())
+		}
+	}
+	finalDir := ssEnv.GetFinalDir()
+	ss.Filepath = fs.PathJoin(finalDir, path.Base(ss.Filepath))
+	for _, file := range ss.Files {
+		file.Filepath = fs.PathJoin(finalDir, path.Base(file.Filepath))
+	}
+	if err := ssEnv.FinalizeSnapshot(&ss); err != nil {
+		return pb.Snapshot{}, firstError(err, ssEnv.RemoveTempDir())
+	}
+	return ss, nil
+}
+
+func copyFile(src importer.ISource,
+	file File, dst string, fs vfs.IFS) (err error) {
+	in, err := src.Open(file.Name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, in.Close())
+	}()
+	out, err := fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, out.Close())
+	}()
+	if _, err := io.Copy(out, newReader(in, file)); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+func installEntries(ldb raftio.ILogDB,
+	r Replica, src importer.ISource, workerID uint64) (err error) {
+	in, err := src.Open(r.Entries.Name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, in.Close())
+	}()
+	br := bufio.NewReader(newReader(in, r.Entries))
+	next := r.FirstIndex
+	entries := make([]pb.Entry, 0, restoreBatchSize)
+	save := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		update := pb.Update{
+			ShardID:       r.ShardID,
+			ReplicaID:     r.ReplicaID,
+			EntriesToSave: entries,
+		}
+		if err := ldb.SaveRaftState([]pb.Update{update}, workerID); err != nil {
+			return err
+		}
+		entries = make([]pb.Entry, 0, restoreBatchSize)
+		return nil
+	}
+	for next <= r.LastIndex {
+		sz, err := binary.ReadUvarint(br)
+		if err != nil {
+			return errors.Wrap(ErrInvalidBackup, err.Error())
+		}
+		if sz > maxEntrySize {
+			return errors.Wrap(ErrInvalidBackup, "entry too large")
+		}
+		data := make([]byte, sz)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return errors.Wrap(ErrInvalidBackup, err.Error())
+		}
+		var e pb.Entry
+		if err := unmarshal(data, &e); err != nil {
+			return err
+		}
+		if e.Index != next {
+			return errors.Wrapf(ErrInvalidBackup,
+				"unexpected entry index %d, want %d", e.Index, next)
+		}
+		entries = append(entries, e)
+		next++
+		if len(entries) == restoreBatchSize {
+			if err := save(); err != nil {
+				return err
+			}
+		}
+	}
+	// the digest of the entries file is only checked once EOF is reached
+	if _, err := br.ReadByte(); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected trailing data")
+		}
+		return errors.Wrap(ErrInvalidBackup, err.Error())
+	}
+	return save()
+}
@@ -0,0 +1,114 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package barrier implements the manifest of coordinated exports. It is shared by
+the SyncCoordinatedExport method of NodeHost and the offline
+ImportBarrierManifest function in the tools package.
+
+This package is internally used by Dragonboat, applications are not expected to
+import this package.
+*/
+package barrier
+
+import (
+	"encoding/json"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/utils"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+const (
+	// ManifestFilename is the name of the manifest file saved in the export
+	// directory.
+	ManifestFilename = "barrier.manifest"
+)
+
+var firstError = utils.FirstError
+
+// Manifest ties together snapshots of multiple shards exported at barriers,
+// each snapshot includes everything up to the barrier proposed to its shard.
+type Manifest struct {
+	// Shards contains the per shard records sorted by shard ID.
+	Shards []Shard
+}
+
+// Shard is the record of a shard in the Manifest.
+type Shard struct {
+	// ShardID is the ID of the shard.
+	ShardID uint64
+	// BarrierIndex is the index of the barrier entry proposed to the shard, it
+	// is 0 when the barrier is not yet recorded.
+	BarrierIndex uint64
+	// SnapshotIndex is the index of the exported snapshot, it is never lower
+	// than BarrierIndex. It is 0 when the snapshot is not yet exported.
+	SnapshotIndex uint64
+	// Path is the path of the exported snapshot directory relative to the
+	// export directory.
+	Path string
+}
+
+// Complete returns a boolean value indicating whether snapshots of all shards
+// have been exported.
+func (m *Manifest) Complete() bool {
+	for _, s := range m.Shards {
+		if s.SnapshotIndex == 0 {
+			return false
+		}
+	}
+	return len(m.Shards) > 0
+}
+
+// Read reads the manifest saved in the specified export directory.
+func Read(dir string, fs vfs.IFS) (_ Manifest, err error) {
+	f, err := fs.Open(fs.PathJoin(dir, ManifestFilename))
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer func() {
+		err = firstError(err, f.Close())
+	}()
+	data, err := fileutil.ReadAll(f)
+	if err != nil {
+		return Manifest{}, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Manifest{}, err
+	}
+	return m, nil
+}
+
+// Save atomically saves the manifest to the specified export directory.
+func Save(dir string, m Manifest, fs vfs.IFS) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := fs.PathJoin(dir, ManifestFilename+".tmp")
+	f, err := fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	err = firstError(err, f.Sync())
+	if err := firstError(err, f.Close()); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmp, fs.PathJoin(dir, ManifestFilename)); err != nil {
+		return err
+	}
+	return fileutil.SyncDir(dir, fs)
+}
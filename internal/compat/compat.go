@@ -0,0 +1,362 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package compat generates and verifies golden data directories used for
+checking that data written by previous versions of dragonboat can still be
+used after in-place upgrades.
+
+A golden data directory contains a NodeHost directory with two shards, each
+with snapshots, a registered client session and a partially compacted log,
+together with the expected state of both shards. Golden data directories are
+generated by Generate at the current server.FormatVersion and checked in,
+Verify checks that the current code can open them, serve the expected reads
+and write new data alongside. CheckFormat checks that data in a NodeHost
+directory stays within its declared format version.
+*/
+package compat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+	"github.com/lni/dragonboat/v4/tools"
+)
+
+const (
+	nodeHostDirName  = "nodehost"
+	expectedFilename = "expected.json"
+	rttMillisecond   = 5
+	// proposals is the number of proposals made to each shard
+	proposals       = 60
+	requestTimeout  = 5 * time.Second
+	readyTimeout    = 30 * time.Second
+	snapshotEntries = 20
+	// compactionOverhead is smaller than snapshotEntries so the log is only
+	// partially compacted after each snapshot
+	compactionOverhead = 5
+)
+
+var (
+	// ErrUnexpectedState indicates that the state of a shard opened from a
+	// golden data directory is not the expected one.
+	ErrUnexpectedState = errors.New("unexpected state")
+	// ErrFormatNotDeclared indicates that data in a NodeHost directory is not
+	// in its declared format version.
+	ErrFormatNotDeclared = errors.New("format not declared")
+)
+
+var shardIDs = []uint64{1, 2}
+
+// Expected is the expected state of a golden data directory.
+type Expected struct {
+	FormatVersion uint32
+	Shards        []ExpectedShard
+}
+
+// ExpectedShard is the expected state of a shard.
+type ExpectedShard struct {
+	ShardID uint64
+	KV      map[string]string
+	// Session is the client session of the last proposal, the proposal is
+	// completed but not yet acknowledged to the shard. Retrying the proposal
+	// is expected to return Result without the proposal being applied again.
+	Session client.Session
+	Result  uint64
+}
+
+func nodeHostConfig(dir string) config.NodeHostConfig {
+	nhConfig := memtransport.NewNetwork().NodeHostConfigs(1,
+		dir, rttMillisecond)[0]
+	nhConfig.NodeHostDir = filepath.Join(dir, nodeHostDirName)
+	nhConfig.WALDir = ""
+	return nhConfig
+}
+
+func replicaConfig(shardID uint64) config.Config {
+	return config.Config{
+		ShardID:            shardID,
+		ReplicaID:          1,
+		ElectionRTT:        10,
+		HeartbeatRTT:       1,
+		SnapshotEntries:    snapshotEntries,
+		CompactionOverhead: compactionOverhead,
+	}
+}
+
+func startReplicas(nh *dragonboat.NodeHost, restart bool) error {
+	for _, shardID := range shardIDs {
+		var members map[uint64]dragonboat.Target
+		if !restart {
+			members = map[uint64]dragonboat.Target{1: nh.RaftAddress()}
+		}
+		if err := nh.StartReplica(members, false,
+			newKVStateMachine, replicaConfig(shardID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retry retries f until it succeeds or readyTimeout has passed, it is used
+// for requests made before replicas become ready.
+func retry(f func(ctx context.Context) error) error {
+	deadline := time.Now().Add(readyTimeout)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		err := f(ctx)
+		cancel()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Generate generates a golden data directory in dir, which must not exist.
+// The NodeHost directory is written by the current code using default
+// settings.
+func Generate(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return errors.Newf("%s already exists", dir)
+	}
+	nh, err := dragonboat.NewNodeHost(nodeHostConfig(dir))
+	if err != nil {
+		return err
+	}
+	defer nh.Close()
+	if err := startReplicas(nh, false); err != nil {
+		return err
+	}
+	expected := Expected{FormatVersion: server.FormatVersion}
+	for _, shardID := range shardIDs {
+		es, err := generateShard(nh, shardID)
+		if err != nil {
+			return errors.Wrapf(err, "shard %d", shardID)
+		}
+		expected.Shards = append(expected.Shards, es)
+	}
+	data, err := json.MarshalIndent(expected, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, expectedFilename), data, 0644)
+}
+
+// generateShard makes proposals to the shard using a client session,
+// snapshots are created automatically and requested explicitly so the log is
+// partially compacted and the last few entries are only in the log.
+func generateShard(nh *dragonboat.NodeHost,
+	shardID uint64) (ExpectedShard, error) {
+	es := ExpectedShard{ShardID: shardID, KV: make(map[string]string)}
+	var cs *client.Session
+	if err := retry(func(ctx context.Context) (err error) {
+		cs, err = nh.SyncGetSession(ctx, shardID)
+		return err
+	}); err != nil {
+		return ExpectedShard{}, err
+	}
+	for i := 0; i < proposals; i++ {
+		key := keyName(shardID, i)
+		value := valueName(shardID, i)
+		var result sm.Result
+		if err := retry(func(ctx context.Context) (err error) {
+			result, err = nh.SyncPropose(ctx, cs, []byte(key+"="+value))
+			return err
+		}); err != nil {
+			return ExpectedShard{}, err
+		}
+		es.KV[key] = value
+		if i == proposals-1 {
+			es.Session = *cs
+			es.Result = result.Value
+			break
+		}
+		cs.ProposalCompleted()
+		if i == proposals/2 {
+			if err := retry(func(ctx context.Context) error {
+				_, err := nh.SyncRequestSnapshot(ctx,
+					shardID, dragonboat.SnapshotOption{})
+				return err
+			}); err != nil {
+				return ExpectedShard{}, err
+			}
+		}
+	}
+	return es, nil
+}
+
+func keyName(shardID uint64, i int) string {
+	return fmt.Sprintf("key-%d-%d", shardID, i)
+}
+
+func valueName(shardID uint64, i int) string {
+	return fmt.Sprintf("value-%d-%d", shardID, i)
+}
+
+// Verify verifies the golden data directory src, it is copied to dst before
+// being opened. The current code is expected to open the copied NodeHost
+// directory, serve the expected reads, handle retried proposals of restored
+// client sessions and write new data that is still there after a restart.
+func Verify(src string, dst string) error {
+	data, err := os.ReadFile(filepath.Join(src, expectedFilename))
+	if err != nil {
+		return err
+	}
+	var expected Expected
+	if err := json.Unmarshal(data, &expected); err != nil {
+		return err
+	}
+	if err := copyDir(filepath.Join(src, nodeHostDirName),
+		filepath.Join(dst, nodeHostDirName)); err != nil {
+		return err
+	}
+	nhConfig := nodeHostConfig(dst)
+	// golden data directories are generated on other hosts
+	if err := tools.RelocateNodeHostDir(nhConfig); err != nil {
+		return err
+	}
+	if err := verify(nhConfig, expected, true); err != nil {
+		return err
+	}
+	return verify(nhConfig, expected, false)
+}
+
+// verify checks the expected state of all shards, data is written to each
+// shard when write is true.
+func verify(nhConfig config.NodeHostConfig,
+	expected Expected, write bool) error {
+	nh, err := dragonboat.NewNodeHost(nhConfig)
+	if err != nil {
+		return err
+	}
+	defer nh.Close()
+	if err := startReplicas(nh, true); err != nil {
+		return err
+	}
+	for _, es := range expected.Shards {
+		if err := verifyShard(nh, es, write); err != nil {
+			return errors.Wrapf(err, "shard %d", es.ShardID)
+		}
+	}
+	return nil
+}
+
+func verifyShard(nh *dragonboat.NodeHost, es ExpectedShard, write bool) error {
+	key := keyName(es.ShardID, proposals)
+	value := valueName(es.ShardID, proposals)
+	if write {
+		// the retried proposal is not expected to be applied again
+		cs := es.Session
+		var result sm.Result
+		if err := retry(func(ctx context.Context) (err error) {
+			result, err = nh.SyncPropose(ctx, &cs, []byte("retried=retried"))
+			return err
+		}); err != nil {
+			return err
+		}
+		if result.Value != es.Result {
+			return errors.Wrapf(ErrUnexpectedState,
+				"retried proposal result %d, want %d", result.Value, es.Result)
+		}
+		cs.ProposalCompleted()
+		if err := retry(func(ctx context.Context) error {
+			_, err := nh.SyncPropose(ctx, &cs, []byte(key+"="+value))
+			return err
+		}); err != nil {
+			return err
+		}
+		if err := retry(func(ctx context.Context) error {
+			_, err := nh.SyncRequestSnapshot(ctx,
+				es.ShardID, dragonboat.SnapshotOption{})
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	var kv map[string]string
+	if err := retry(func(ctx context.Context) error {
+		v, err := nh.SyncRead(ctx, es.ShardID, nil)
+		if err != nil {
+			return err
+		}
+		kv = v.(map[string]string)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(kv) != len(es.KV)+1 {
+		return errors.Wrapf(ErrUnexpectedState,
+			"%d keys, want %d", len(kv), len(es.KV)+1)
+	}
+	for k, v := range es.KV {
+		if kv[k] != v {
+			return errors.Wrapf(ErrUnexpectedState,
+				"key %s, value %q, want %q", k, kv[k], v)
+		}
+	}
+	if kv[key] != value {
+		return errors.Wrapf(ErrUnexpectedState,
+			"new key %s, value %q, want %q", key, kv[key], value)
+	}
+	return nil
+}
+
+func copyDir(src string, dst string) error {
+	return filepath.Walk(src, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, fp)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		return copyFile(fp, target)
+	})
+}
+
+func copyFile(src string, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.CombineErrors(err, in.Close())
+	}()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		return errors.CombineErrors(err, out.Close())
+	}
+	return out.Close()
+}
@@ -0,0 +1,96 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compat
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/logger"
+)
+
+// run the following command to generate the golden data directory of the
+// current format version after bumping server.FormatVersion
+//
+//	go test -run TestGenerateGoldenData -compat.generate
+var generate = flag.Bool("compat.generate", false,
+	"generate golden data of the current format version")
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	for _, name := range []string{"dragonboat", "raft", "rsm", "transport",
+		"logdb", "config", "registry", "raftpb", "server", "tools"} {
+		logger.GetLogger(name).SetLevel(logger.ERROR)
+	}
+	os.Exit(m.Run())
+}
+
+func goldenDataDir(version uint32) string {
+	return filepath.Join("testdata", fmt.Sprintf("v%d", version))
+}
+
+func TestGenerateGoldenData(t *testing.T) {
+	if !*generate {
+		t.Skip("-compat.generate not set")
+	}
+	if err := Generate(goldenDataDir(server.FormatVersion)); err != nil {
+		t.Fatalf("failed to generate golden data %v", err)
+	}
+}
+
+func TestGoldenDataExistsForCurrentFormatVersion(t *testing.T) {
+	if _, err := os.Stat(goldenDataDir(server.FormatVersion)); err != nil {
+		t.Fatalf("no golden data for format version %d, %v",
+			server.FormatVersion, err)
+	}
+}
+
+func TestGoldenDataCanBeUsed(t *testing.T) {
+	for v := server.MinFormatVersion; v <= server.FormatVersion; v++ {
+		v := v
+		t.Run(fmt.Sprintf("v%d", v), func(t *testing.T) {
+			src := goldenDataDir(v)
+			if err := CheckFormat(filepath.Join(src, nodeHostDirName), v); err != nil {
+				t.Fatalf("golden data not in its format %v", err)
+			}
+			dst := t.TempDir()
+			if err := Verify(src, dst); err != nil {
+				t.Fatalf("failed to verify golden data %v", err)
+			}
+			// data written by the current code is now in the current format
+			nhDir := filepath.Join(dst, nodeHostDirName)
+			if err := CheckFormat(nhDir, server.FormatVersion); err != nil {
+				t.Errorf("upgraded data not in the current format %v", err)
+			}
+		})
+	}
+}
+
+func TestWrittenDataIsInDeclaredFormat(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "generated")
+	if err := Generate(dir); err != nil {
+		t.Fatalf("failed to generate data %v", err)
+	}
+	nhDir := filepath.Join(dir, nodeHostDirName)
+	if err := CheckFormat(nhDir, server.FormatVersion); err != nil {
+		t.Fatalf("data written by the current code is not in format version "+
+			"%d, bump server.FormatVersion when changing on disk formats, %v",
+			server.FormatVersion, err)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compat
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// flagFilename is the name of the flag file kept by server.Env in the
+// NodeHost data directory.
+const flagFilename = "dragonboat.ds"
+
+// CheckFormat checks that data in the NodeHost directory nhDir is in the
+// declared format of the specified format version. The format manifest,
+// the flag file and all snapshot files are checked.
+func CheckFormat(nhDir string, version uint32) error {
+	dataDir, err := findDataDir(nhDir)
+	if err != nil {
+		return err
+	}
+	fs := vfs.DefaultFS
+	m, err := server.LoadFormatManifest(dataDir, fs)
+	if err != nil {
+		return err
+	}
+	format, ok := server.Formats[version]
+	if !ok {
+		return errors.Wrapf(ErrFormatNotDeclared, "format version %d", version)
+	}
+	if m.FormatVersion != version || !format.Includes(m) {
+		return errors.Wrapf(ErrFormatNotDeclared,
+			"manifest %+v, format version %d %+v", m, version, format)
+	}
+	var s pb.RaftDataStatus
+	if err := fileutil.GetFlagFileContent(dataDir,
+		flagFilename, &s, fs); err != nil {
+		return err
+	}
+	if s.BinVer != m.LogDBBinVersion {
+		return errors.Wrapf(ErrFormatNotDeclared,
+			"flag file LogDB bin version %d, manifest %+v", s.BinVer, m)
+	}
+	suffix := "." + server.SnapshotFileSuffix
+	return filepath.Walk(dataDir,
+		func(fp string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !strings.HasSuffix(fp, suffix) {
+				return nil
+			}
+			return checkSnapshotFile(fp, format, fs)
+		})
+}
+
+func checkSnapshotFile(fp string, format server.Format, fs vfs.IFS) error {
+	r, header, err := rsm.NewSnapshotReader(fp, fs)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, r)
+	if err := errors.CombineErrors(err, r.Close()); err != nil {
+		return err
+	}
+	if header.Version != format.SnapshotVersion {
+		return errors.Wrapf(ErrFormatNotDeclared,
+			"snapshot %s version %d, declared %+v", fp, header.Version, format)
+	}
+	return nil
+}
+
+// findDataDir returns the NodeHost data directory, i.e. the directory
+// containing the format manifest, found in nhDir.
+func findDataDir(nhDir string) (string, error) {
+	var dirs []string
+	if err := filepath.Walk(nhDir,
+		func(fp string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && info.Name() == server.FormatManifestFilename {
+				dirs = append(dirs, filepath.Dir(fp))
+			}
+			return nil
+		}); err != nil {
+		return "", err
+	}
+	if len(dirs) != 1 {
+		return "", errors.Newf("%d format manifests found in %s",
+			len(dirs), nhDir)
+	}
+	return dirs[0], nil
+}
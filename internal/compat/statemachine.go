@@ -0,0 +1,83 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compat
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// kvStateMachine is the state machine of golden data directories, its
+// snapshots must stay readable by all future versions so its format must
+// never change.
+type kvStateMachine struct {
+	kv map[string]string
+}
+
+var _ sm.IStateMachine = (*kvStateMachine)(nil)
+
+func newKVStateMachine(shardID uint64, replicaID uint64) sm.IStateMachine {
+	return &kvStateMachine{kv: make(map[string]string)}
+}
+
+// Update sets the key to the value in the key=value command, the index of the
+// entry is returned as the result.
+func (s *kvStateMachine) Update(e sm.Entry) (sm.Result, error) {
+	parts := strings.SplitN(string(e.Cmd), "=", 2)
+	if len(parts) == 2 {
+		s.kv[parts[0]] = parts[1]
+	}
+	return sm.Result{Value: e.Index}, nil
+}
+
+// Lookup returns a copy of all key value pairs.
+func (s *kvStateMachine) Lookup(query interface{}) (interface{}, error) {
+	kv := make(map[string]string, len(s.kv))
+	for k, v := range s.kv {
+		kv[k] = v
+	}
+	return kv, nil
+}
+
+func (s *kvStateMachine) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	data, err := json.Marshal(s.kv)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (s *kvStateMachine) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	kv := make(map[string]string)
+	if err := json.Unmarshal(data, &kv); err != nil {
+		return err
+	}
+	s.kv = kv
+	return nil
+}
+
+func (s *kvStateMachine) Close() error {
+	return nil
+}
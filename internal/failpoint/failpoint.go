@@ -0,0 +1,204 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package failpoint implements named failpoints placed at crash sensitive
+locations of dragonboat, e.g. right after the Raft state is persisted but
+before any response is sent. Tests program a failpoint to panic, sleep or
+return an injected error in order to exercise recovery from those windows.
+
+Failpoints are only compiled into dragonboat when the dragonboat_testfp build
+tag is set, Inject is a no-op and Enable always fails otherwise.
+*/
+package failpoint
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+const (
+	// AfterSaveRaftState is reached after the Raft state and entries of an
+	// update batch have been synced to the LogDB, before any of those entries
+	// is applied or acknowledged.
+	AfterSaveRaftState = "after-save-raft-state"
+	// BeforeSnapshotRename is reached when a snapshot has been fully written
+	// to its temp directory, before it is renamed to its final directory.
+	BeforeSnapshotRename = "before-snapshot-rename"
+	// AfterSnapshotRename is reached after a snapshot is renamed to its final
+	// directory, before it is recorded in the LogDB.
+	AfterSnapshotRename = "after-snapshot-rename"
+	// AfterConfigChangeApply is reached after a config change has been
+	// applied to the membership of the state machine, before the Raft node
+	// is notified.
+	AfterConfigChangeApply = "after-config-change-apply"
+	// BeforeReplicateResp is reached on followers after Replicate entries
+	// are appended to the log, before the ReplicateResp message is sent.
+	BeforeReplicateResp = "before-replicate-resp"
+	// BeforeRecoverFromSnapshot is reached after the user state machine
+	// recovered from a snapshot, before the recovery is completed by updating
+	// the membership and the applied index.
+	BeforeRecoverFromSnapshot = "before-recover-from-snapshot"
+)
+
+var names = map[string]struct{}{
+	AfterSaveRaftState:        {},
+	BeforeSnapshotRename:      {},
+	AfterSnapshotRename:       {},
+	AfterConfigChangeApply:    {},
+	BeforeReplicateResp:       {},
+	BeforeRecoverFromSnapshot: {},
+}
+
+var (
+	// ErrDisabled indicates that failpoints are not compiled into dragonboat,
+	// the dragonboat_testfp build tag is required.
+	ErrDisabled = errors.New("failpoints disabled")
+	// ErrUnknownFailpoint indicates that the failpoint name is unknown.
+	ErrUnknownFailpoint = errors.New("unknown failpoint")
+	// ErrInjected is the error returned or panicked with by failpoints when
+	// no other error is specified.
+	ErrInjected = errors.New("failpoint injected error")
+)
+
+type actionType uint64
+
+const (
+	panicAction actionType = iota
+	sleepAction
+	errorAction
+)
+
+// Action is the action taken when an enabled failpoint is reached.
+type Action struct {
+	actionType actionType
+	sleep      time.Duration
+	err        error
+}
+
+// Panic returns an Action that panics with an error wrapping ErrInjected.
+// Panics in engine workers terminate the process, so it is used to simulate
+// crashes.
+func Panic() Action {
+	return Action{actionType: panicAction}
+}
+
+// Sleep returns an Action that blocks the caller for the specified duration
+// before letting it continue.
+func Sleep(d time.Duration) Action {
+	return Action{actionType: sleepAction, sleep: d}
+}
+
+// Error returns an Action that has the failpoint return the specified error
+// to its caller, ErrInjected is returned when err is nil.
+func Error(err error) Action {
+	if err == nil {
+		err = ErrInjected
+	}
+	return Action{actionType: errorAction, err: err}
+}
+
+type failpoint struct {
+	action  Action
+	enabled bool
+	hits    uint64
+}
+
+var registry = struct {
+	sync.Mutex
+	points map[string]*failpoint
+}{
+	points: make(map[string]*failpoint),
+}
+
+// Enable programs the named failpoint to take the specified action each
+// time it is reached until it is disabled.
+func Enable(name string, action Action) error {
+	if !Enabled {
+		return ErrDisabled
+	}
+	if _, ok := names[name]; !ok {
+		return errors.Wrapf(ErrUnknownFailpoint, "%s", name)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	registry.points[name] = &failpoint{action: action, enabled: true}
+	return nil
+}
+
+// Disable disables the named failpoint.
+func Disable(name string) {
+	registry.Lock()
+	defer registry.Unlock()
+	if fp, ok := registry.points[name]; ok {
+		fp.enabled = false
+	}
+}
+
+// Reset disables all failpoints and clears their hit counts.
+func Reset() {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.points = make(map[string]*failpoint)
+}
+
+// Hits returns the number of times the named failpoint was reached since it
+// was last enabled.
+func Hits(name string) uint64 {
+	registry.Lock()
+	defer registry.Unlock()
+	if fp, ok := registry.points[name]; ok {
+		return fp.hits
+	}
+	return 0
+}
+
+// Inject takes the action programmed for the named failpoint. It returns
+// the injected error when the failpoint is programmed to return one, nil is
+// returned when the failpoint is not enabled or when dragonboat is built
+// without the dragonboat_testfp build tag.
+func Inject(name string) error {
+	if !Enabled {
+		return nil
+	}
+	action, ok := get(name)
+	if !ok {
+		return nil
+	}
+	switch action.actionType {
+	case panicAction:
+		panic(errors.Wrapf(ErrInjected, "failpoint %s", name))
+	case sleepAction:
+		time.Sleep(action.sleep)
+		return nil
+	case errorAction:
+		return action.err
+	default:
+		panic(fmt.Sprintf("unknown action type %d", action.actionType))
+	}
+}
+
+func get(name string) (Action, bool) {
+	registry.Lock()
+	defer registry.Unlock()
+	fp, ok := registry.points[name]
+	if !ok || !fp.enabled {
+		return Action{}, false
+	}
+	fp.hits++
+	return fp.action, true
+}
@@ -0,0 +1,104 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package failpoint
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+func TestEnableFailsWhenDisabled(t *testing.T) {
+	if Enabled {
+		t.Skip("failpoints enabled")
+	}
+	if err := Enable(AfterSaveRaftState, Panic()); !errors.Is(err, ErrDisabled) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := Inject(AfterSaveRaftState); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestUnknownFailpointCanNotBeEnabled(t *testing.T) {
+	if !Enabled {
+		t.Skip("failpoints disabled")
+	}
+	if err := Enable("unknown", Panic()); !errors.Is(err, ErrUnknownFailpoint) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestFailpointActions(t *testing.T) {
+	if !Enabled {
+		t.Skip("failpoints disabled")
+	}
+	defer Reset()
+	if err := Inject(AfterSaveRaftState); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if Hits(AfterSaveRaftState) != 0 {
+		t.Errorf("hits counted when not enabled")
+	}
+	testErr := errors.New("test error")
+	if err := Enable(AfterSaveRaftState, Error(testErr)); err != nil {
+		t.Fatalf("failed to enable %v", err)
+	}
+	if err := Inject(AfterSaveRaftState); err != testErr {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := Inject(BeforeSnapshotRename); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := Enable(BeforeSnapshotRename, Error(nil)); err != nil {
+		t.Fatalf("failed to enable %v", err)
+	}
+	if err := Inject(BeforeSnapshotRename); !errors.Is(err, ErrInjected) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := Enable(AfterSnapshotRename, Sleep(50*time.Millisecond)); err != nil {
+		t.Fatalf("failed to enable %v", err)
+	}
+	start := time.Now()
+	if err := Inject(AfterSnapshotRename); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("didn't sleep")
+	}
+	if err := Enable(BeforeReplicateResp, Panic()); err != nil {
+		t.Fatalf("failed to enable %v", err)
+	}
+	func() {
+		defer func() {
+			r := recover()
+			if err, ok := r.(error); !ok || !errors.Is(err, ErrInjected) {
+				t.Errorf("unexpected panic %v", r)
+			}
+		}()
+		_ = Inject(BeforeReplicateResp)
+	}()
+	if Hits(AfterSaveRaftState) != 1 || Hits(BeforeReplicateResp) != 1 {
+		t.Errorf("unexpected hits")
+	}
+	Disable(AfterSaveRaftState)
+	if err := Inject(AfterSaveRaftState); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if Hits(AfterSaveRaftState) != 1 {
+		t.Errorf("hits counted after disabled")
+	}
+}
@@ -46,6 +46,9 @@ const (
 	deleteFilename       = "DELETED.dragonboat"
 )
 
+// ErrCorruptedFlagFile indicates that the content of a flag file is corrupted.
+var ErrCorruptedFlagFile = errors.New("corrupted flag file")
+
 var firstError = utils.FirstError
 
 var ws = errors.WithStack
@@ -224,6 +227,30 @@ func CreateFlagFile(dir string,
 	return ws(f.Sync())
 }
 
+// MarshalFlagFileContent returns the content of the flag file created by
+// CreateFlagFile for the specified protobuf message.
+func MarshalFlagFileContent(msg pb.Marshaler) []byte {
+	data := pb.MustMarshal(msg)
+	return append(getHash(data), data...)
+}
+
+// UnmarshalFlagFileContent unmarshals the flag file content created by
+// CreateFlagFile into the specified protobuf message. Unlike
+// GetFlagFileContent, ErrCorruptedFlagFile is returned when the content is
+// corrupted.
+func UnmarshalFlagFileContent(data []byte, msg pb.Unmarshaler) error {
+	if len(data) < 8 {
+		return ErrCorruptedFlagFile
+	}
+	if !bytes.Equal(data[:8], getHash(data[8:])) {
+		return ErrCorruptedFlagFile
+	}
+	if err := msg.Unmarshal(data[8:]); err != nil {
+		return errors.Wrap(ErrCorruptedFlagFile, err.Error())
+	}
+	return nil
+}
+
 // GetFlagFileContent gets the content of the flag file found in the specified
 // location. The data of the flag file will be unmarshaled into the specified
 // protobuf message.
@@ -273,6 +300,37 @@ func RemoveFlagFile(dir string, filename string, fs vfs.IFS) error {
 	return fs.Remove(fs.PathJoin(dir, filename))
 }
 
+// DirSize returns the total size in bytes of all files found in the specified
+// directory and its sub-directories. Files removed while being walked are
+// ignored.
+func DirSize(dir string, fs vfs.IFS) (uint64, error) {
+	names, err := fs.List(dir)
+	if err != nil {
+		return 0, ws(err)
+	}
+	sz := uint64(0)
+	for _, name := range names {
+		fp := fs.PathJoin(dir, name)
+		fi, err := fs.Stat(fp)
+		if err != nil {
+			if vfs.IsNotExist(err) {
+				continue
+			}
+			return 0, ws(err)
+		}
+		if fi.IsDir() {
+			v, err := DirSize(fp, fs)
+			if err != nil {
+				return 0, err
+			}
+			sz += v
+		} else {
+			sz += uint64(fi.Size())
+		}
+	}
+	return sz, nil
+}
+
 // ExtractTarBz2 extracts files and directories from the specified tar.bz2 file
 // to the specified target directory.
 func ExtractTarBz2(bz2fn string, toDir string, fs vfs.IFS) (err error) {
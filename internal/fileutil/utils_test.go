@@ -29,3 +29,22 @@ func TestTempDir(t *testing.T) {
 	require.NoError(t, err)
 	require.NotEqual(t, dir1, dir2)
 }
+
+func TestDirSize(t *testing.T) {
+	fs := vfs.NewMemFS()
+	require.NoError(t, fs.MkdirAll("data/sub", 0755))
+	write := func(fp string, sz int) {
+		f, err := fs.Create(fp)
+		require.NoError(t, err)
+		_, err = f.Write(make([]byte, sz))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	write("data/f1", 100)
+	write("data/sub/f2", 200)
+	sz, err := DirSize("data", fs)
+	require.NoError(t, err)
+	require.Equal(t, uint64(300), sz)
+	_, err = DirSize("missing", fs)
+	require.Error(t, err)
+}
@@ -0,0 +1,273 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package importer
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"path"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/server"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	// ArchiveVersion is the version of the snapshot archive format.
+	ArchiveVersion uint32 = 1
+	// ManifestFilename is the name of the manifest entry, it is always the
+	// first entry of the snapshot archive.
+	ManifestFilename = "MANIFEST"
+	// maxManifestSize is the max size of the manifest entry accepted.
+	maxManifestSize = 64 * 1024 * 1024
+)
+
+var (
+	// ErrInvalidArchive indicates that the snapshot archive is corrupted or
+	// not in a supported format.
+	ErrInvalidArchive = errors.New("invalid snapshot archive")
+)
+
+// ManifestFile describes a file stored in the snapshot archive.
+type ManifestFile struct {
+	// Name is the slash separated path of the file relative to the export
+	// directory, it is also the name of its archive entry.
+	Name string `json:"name"`
+	// Size is the size of the file in bytes.
+	Size uint64 `json:"size"`
+	// SHA256 is the hex encoded SHA-256 digest of the file content.
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest is the content of the first entry of the snapshot archive, it is
+// JSON encoded.
+//
+// The snapshot archive is a tar stream, the manifest entry is followed by one
+// entry for each file listed in Files in the same order, the snapshot image is
+// always the first one. The metadata file of the exported snapshot is not
+// stored as an entry, its content is carried by the manifest instead so the
+// snapshot record is known before any file is read. Checksum is the hex
+// encoded SHA-256 digest of the JSON encoded manifest with Checksum set to
+// empty.
+type Manifest struct {
+	Version  uint32         `json:"version"`
+	ShardID  uint64         `json:"shard_id"`
+	Index    uint64         `json:"index"`
+	Term     uint64         `json:"term"`
+	Metadata []byte         `json:"metadata"`
+	Files    []ManifestFile `json:"files"`
+	Checksum string         `json:"checksum"`
+}
+
+func (m Manifest) checksum() (string, error) {
+	m.Checksum = ""
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// validate checks the manifest and returns the snapshot record carried by it.
+func (m Manifest) validate() (pb.Snapshot, error) {
+	checksum, err := m.checksum()
+	if err != nil {
+		return pb.Snapshot{}, err
+	}
+	if checksum != m.Checksum {
+		return pb.Snapshot{}, errors.Wrap(ErrInvalidArchive, "manifest checksum")
+	}
+	if m.Version != ArchiveVersion {
+		return pb.Snapshot{}, errors.Wrapf(ErrInvalidArchive,
+			"unsupported version %d", m.Version)
+	}
+	var ss pb.Snapshot
+	if err := fileutil.UnmarshalFlagFileContent(m.Metadata, &ss); err != nil {
+		return pb.Snapshot{}, errors.Wrap(ErrInvalidArchive, err.Error())
+	}
+	if ss.ShardID != m.ShardID || ss.Index != m.Index || ss.Term != m.Term {
+		return pb.Snapshot{}, errors.Wrap(ErrInvalidArchive, "metadata mismatch")
+	}
+	if len(m.Files) != len(ss.Files)+1 ||
+		path.Base(m.Files[0].Name) != path.Base(ss.Filepath) {
+		return pb.Snapshot{}, errors.Wrap(ErrInvalidArchive, "unexpected files")
+	}
+	return ss, nil
+}
+
+// WriteArchive writes the snapshot archive described by m to w, the content of
+// the files listed in the manifest is read from src using their names. The
+// checksum of the manifest is set by WriteArchive. w is never seeked so the
+// archive can be streamed to its destination.
+func WriteArchive(w io.Writer, m Manifest, src ISource) error {
+	m.Version = ArchiveVersion
+	checksum, err := m.checksum()
+	if err != nil {
+		return err
+	}
+	m.Checksum = checksum
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	if err := writeEntry(tw,
+		ManifestFilename, uint64(len(data)), bytes.NewReader(data)); err != nil {
+		return err
+	}
+	for _, f := range m.Files {
+		if err := writeFileEntry(tw, f, src); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeFileEntry(tw *tar.Writer, f ManifestFile, src ISource) (err error) {
+	in, err := src.Open(f.Name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, in.Close())
+	}()
+	return writeEntry(tw, f.Name, f.Size, in)
+}
+
+func writeEntry(tw *tar.Writer, name string, sz uint64, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(sz),
+		Mode:     0644,
+	}); err != nil {
+		return err
+	}
+	_, err := io.CopyN(tw, r, int64(sz))
+	return err
+}
+
+// ArchiveSource is an ISource providing the files of an exported snapshot
+// stored in a snapshot archive. The archive is read sequentially, files other
+// than the metadata file must be opened in the order they are stored in the
+// archive, which is the order used by Install. The content of each file is
+// checked against its size and SHA-256 digest recorded in the manifest.
+type ArchiveSource struct {
+	tr       *tar.Reader
+	manifest Manifest
+	next     int
+}
+
+var _ ISource = (*ArchiveSource)(nil)
+
+// NewArchiveSource returns an ArchiveSource reading the snapshot archive from
+// r. The manifest is read and validated before NewArchiveSource returns,
+// ErrInvalidArchive is returned when it is corrupted.
+func NewArchiveSource(r io.Reader) (*ArchiveSource, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidArchive, err.Error())
+	}
+	if hdr.Name != ManifestFilename || hdr.Size > maxManifestSize {
+		return nil, errors.Wrap(ErrInvalidArchive, "manifest not found")
+	}
+	data, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidArchive, err.Error())
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrap(ErrInvalidArchive, err.Error())
+	}
+	if _, err := m.validate(); err != nil {
+		return nil, err
+	}
+	return &ArchiveSource{tr: tr, manifest: m}, nil
+}
+
+// Manifest returns the manifest of the snapshot archive.
+func (s *ArchiveSource) Manifest() Manifest {
+	return s.manifest
+}
+
+// Open opens the named file, name is the name of the file in the exported
+// snapshot directory.
+func (s *ArchiveSource) Open(name string) (io.ReadCloser, error) {
+	if name == server.MetadataFilename {
+		return io.NopCloser(bytes.NewReader(s.manifest.Metadata)), nil
+	}
+	idx := -1
+	for i := s.next; i < len(s.manifest.Files); i++ {
+		if path.Base(s.manifest.Files[i].Name) == name {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, errors.Newf("%s not found in the remaining archive", name)
+	}
+	for ; s.next <= idx; s.next++ {
+		f := s.manifest.Files[s.next]
+		hdr, err := s.tr.Next()
+		if err != nil {
+			return nil, errors.Wrap(ErrInvalidArchive, err.Error())
+		}
+		if hdr.Name != f.Name || hdr.Size != int64(f.Size) {
+			return nil, errors.Wrapf(ErrInvalidArchive,
+				"unexpected entry %s, size %d", hdr.Name, hdr.Size)
+		}
+	}
+	return &archiveFile{
+		r:    s.tr,
+		file: s.manifest.Files[idx],
+		h:    sha256.New(),
+	}, nil
+}
+
+// archiveFile is a file stored in the snapshot archive, its content is checked
+// once it is fully read.
+type archiveFile struct {
+	r    io.Reader
+	file ManifestFile
+	h    hash.Hash
+	read uint64
+}
+
+func (f *archiveFile) Read(data []byte) (int, error) {
+	n, err := f.r.Read(data)
+	f.h.Write(data[:n])
+	f.read += uint64(n)
+	if err == io.EOF {
+		if f.read != f.file.Size ||
+			hex.EncodeToString(f.h.Sum(nil)) != f.file.SHA256 {
+			return n, errors.Wrapf(ErrInvalidArchive,
+				"%s failed the checksum check", f.file.Name)
+		}
+	}
+	return n, err
+}
+
+func (f *archiveFile) Close() error {
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package importer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+type memSource map[string][]byte
+
+func (s memSource) Open(name string) (io.ReadCloser, error) {
+	data, ok := s[name]
+	if !ok {
+		return nil, errors.Newf("%s not found", name)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func getTestManifestFile(name string, data []byte) ManifestFile {
+	sum := sha256.Sum256(data)
+	return ManifestFile{
+		Name:   name,
+		Size:   uint64(len(data)),
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+}
+
+// writeTestArchive writes a snapshot archive with a snapshot image and an
+// external file, the source files are returned.
+func writeTestArchive(t *testing.T, w io.Writer) memSource {
+	image := make([]byte, 4096)
+	_, _ = rand.Read(image)
+	external := []byte("external-file-data")
+	ss := pb.Snapshot{
+		ShardID:  1,
+		Index:    100,
+		Term:     2,
+		Filepath: "snapshot-0000000000000064/snapshot-0000000000000064.gbsnap",
+		Files: []*pb.SnapshotFile{
+			{Filepath: "snapshot-0000000000000064/external-file-1", FileId: 1},
+		},
+	}
+	src := memSource{
+		ss.Filepath:          image,
+		ss.Files[0].Filepath: external,
+	}
+	m := Manifest{
+		ShardID:  ss.ShardID,
+		Index:    ss.Index,
+		Term:     ss.Term,
+		Metadata: fileutil.MarshalFlagFileContent(&ss),
+		Files: []ManifestFile{
+			getTestManifestFile(ss.Filepath, image),
+			getTestManifestFile(ss.Files[0].Filepath, external),
+		},
+	}
+	if err := WriteArchive(w, m, src); err != nil {
+		t.Fatalf("failed to write archive %v", err)
+	}
+	return src
+}
+
+func readTestArchiveFile(src ISource, name string) ([]byte, error) {
+	f, err := src.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func TestArchiveSource(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	files := writeTestArchive(t, buf)
+	src, err := NewArchiveSource(buf)
+	if err != nil {
+		t.Fatalf("failed to read archive %v", err)
+	}
+	if m := src.Manifest(); m.Version != ArchiveVersion || m.Index != 100 {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+	ss, err := GetSnapshotRecord(src)
+	if err != nil {
+		t.Fatalf("failed to get snapshot record %v", err)
+	}
+	if ss.ShardID != 1 || ss.Index != 100 || ss.Term != 2 {
+		t.Errorf("unexpected snapshot record %+v", ss)
+	}
+	for _, name := range []string{ss.Filepath, ss.Files[0].Filepath} {
+		data, err := readTestArchiveFile(src, path.Base(name))
+		if err != nil {
+			t.Fatalf("failed to read %s, %v", name, err)
+		}
+		if !bytes.Equal(data, files[name]) {
+			t.Errorf("unexpected content of %s", name)
+		}
+	}
+}
+
+func TestArchiveFilesMustBeOpenedInOrder(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	writeTestArchive(t, buf)
+	src, err := NewArchiveSource(buf)
+	if err != nil {
+		t.Fatalf("failed to read archive %v", err)
+	}
+	if _, err := readTestArchiveFile(src, "external-file-1"); err != nil {
+		t.Fatalf("failed to read external file %v", err)
+	}
+	if _, err := src.Open("snapshot-0000000000000064.gbsnap"); err == nil {
+		t.Errorf("skipped file unexpectedly opened")
+	}
+}
+
+func TestCorruptedManifestIsReported(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	writeTestArchive(t, buf)
+	// the manifest content follows the 512 bytes tar header
+	for _, offset := range []int{0, 512 + 20, 512 + 200} {
+		data := append([]byte{}, buf.Bytes()...)
+		data[offset]++
+		if _, err := NewArchiveSource(bytes.NewReader(data)); !errors.Is(err,
+			ErrInvalidArchive) {
+			t.Errorf("offset %d, unexpected error %v", offset, err)
+		}
+	}
+	if _, err := NewArchiveSource(bytes.NewReader(nil)); !errors.Is(err,
+		ErrInvalidArchive) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestCorruptedArchiveFileIsReported(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	writeTestArchive(t, buf)
+	data := buf.Bytes()
+	// the tar trailer and the external file entry occupy the last 2048 bytes,
+	// the snapshot image is right before them
+	data[len(data)-2048-100]++
+	src, err := NewArchiveSource(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to read archive %v", err)
+	}
+	_, err = readTestArchiveFile(src, "snapshot-0000000000000064.gbsnap")
+	if !errors.Is(err, ErrInvalidArchive) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,367 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package importer implements the import of exported snapshots. It is shared by
+the offline ImportSnapshot function in the tools package and the online
+ImportSnapshot method of NodeHost.
+
+This package is internally used by Dragonboat, applications are not expected to
+import this package.
+*/
+package importer
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/utils"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+var (
+	// ErrInvalidMembers indicates that the provided member nodes is invalid.
+	ErrInvalidMembers = errors.New("invalid members")
+	// ErrIncompleteSnapshot indicates that the exported snapshot is incomplete.
+	ErrIncompleteSnapshot = errors.New("snapshot is incomplete")
+)
+
+var firstError = utils.FirstError
+
+// ISource provides the files of an exported snapshot, files are opened using
+// their names in the exported snapshot directory.
+type ISource interface {
+	Open(name string) (io.ReadCloser, error)
+}
+
+type dirSource struct {
+	fs  vfs.IFS
+	dir string
+}
+
+// NewDirSource returns an ISource providing files of the exported snapshot in
+// the specified directory.
+func NewDirSource(dir string, fs vfs.IFS) ISource {
+	return &dirSource{dir: dir, fs: fs}
+}
+
+func (s *dirSource) Open(name string) (io.ReadCloser, error) {
+	return s.fs.Open(s.fs.PathJoin(s.dir, name))
+}
+
+// GetSnapshotRecord returns the snapshot record saved in the metadata file of
+// the exported snapshot.
+func GetSnapshotRecord(src ISource) (ss pb.Snapshot, err error) {
+	f, err := src.Open(server.MetadataFilename)
+	if err != nil {
+		return pb.Snapshot{}, err
+	}
+	defer func() {
+		err = firstError(err, f.Close())
+	}()
+	data, err := fileutil.ReadAll(f)
+	if err != nil {
+		return pb.Snapshot{}, err
+	}
+	if err := fileutil.UnmarshalFlagFileContent(data, &ss); err != nil {
+		return pb.Snapshot{}, err
+	}
+	return ss, nil
+}
+
+// CheckMembers checks whether the specified members can be used as the new
+// membership of the snapshot.
+func CheckMembers(old pb.Membership, members map[uint64]string) error {
+	for replicaID, addr := range members {
+		v, ok := old.Addresses[replicaID]
+		if ok && v != addr {
+			return errors.New("node address changed")
+		}
+		v, ok = old.NonVotings[replicaID]
+		if ok && v != addr {
+			return errors.New("node address changed")
+		}
+		if ok {
+			return errors.New("adding an nonVoting as regular node")
+		}
+		v, ok = old.Witnesses[replicaID]
+		if ok && v != addr {
+			return errors.New("node address changed")
+		}
+		if ok {
+			return errors.New("adding a witness as regular node")
+		}
+		if old.IsRemoved(replicaID) {
+			return errors.New("adding a removed node")
+		}
+	}
+	return nil
+}
+
+// CleanupSnapshotDir removes all snapshots found in the specified snapshot
+// directory of a replica.
+func CleanupSnapshotDir(dir string, fs vfs.IFS) error {
+	files, err := fs.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, v := range files {
+		fi, err := fs.Stat(fs.PathJoin(dir, v))
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			continue
+		}
+		name := []byte(fi.Name())
+		if server.SnapshotDirNameRe.Match(name) ||
+			server.GenSnapshotDirNameRe.Match(name) ||
+			server.RecvSnapshotDirNameRe.Match(name) {
+			ssdir := fs.PathJoin(dir, fi.Name())
+			if err := fs.RemoveAll(ssdir); err != nil {
+				return err
+			}
+		}
+	}
+	return fileutil.SyncDir(dir, fs)
+}
+
+// Options are the options used when installing an exported snapshot.
+type Options struct {
+	// ShardID is the ID of the shard the snapshot is installed to. The shard
+	// that exported the snapshot is cloned when ShardID is different from the
+	// ShardID of the snapshot record.
+	ShardID uint64
+	// StripSessions indicates whether client sessions saved in the snapshot
+	// image should be removed.
+	StripSessions bool
+}
+
+// Install installs the exported snapshot provided by src as the snapshot of
+// the specified replica, the membership of the snapshot is rewritten to the
+// specified members. old is the snapshot record found in the metadata file of
+// the exported snapshot, the payload checksum of the snapshot image is
+// checked against it. The snapshot directory of the replica must exist.
+func Install(ldb raftio.ILogDB, getSnapshotDir server.SnapshotDirFunc,
+	old pb.Snapshot, src ISource, members map[uint64]string,
+	replicaID uint64, opts Options, fs vfs.IFS) error {
+	if opts.ShardID == 0 {
+		opts.ShardID = old.ShardID
+	}
+	ssEnv := server.NewSSEnv(getSnapshotDir,
+		opts.ShardID, replicaID, old.Index, replicaID, server.SnapshotMode, fs)
+	if err := ssEnv.CreateTempDir(); err != nil {
+		return err
+	}
+	dstDir := ssEnv.GetTempDir()
+	finalDir := ssEnv.GetFinalDir()
+	if err := copySnapshot(old, src, dstDir, fs); err != nil {
+		return firstError(err, ssEnv.RemoveTempDir())
+	}
+	fp := fs.PathJoin(dstDir, fs.PathBase(old.Filepath))
+	ok, err := isCompleteSnapshotImage(fp, old, fs)
+	if err != nil {
+		return firstError(err, ssEnv.RemoveTempDir())
+	}
+	if !ok {
+		return firstError(ErrIncompleteSnapshot, ssEnv.RemoveTempDir())
+	}
+	ss := GetProcessedSnapshotRecord(finalDir, old, members, fs)
+	if opts.ShardID != old.ShardID {
+		ss = GetClonedSnapshotRecord(ss, opts.ShardID, members)
+	}
+	if opts.StripSessions {
+		if err := stripSessions(&ss, fp, fs); err != nil {
+			return firstError(err, ssEnv.RemoveTempDir())
+		}
+	}
+	if err := ssEnv.FinalizeSnapshot(&ss); err != nil {
+		return firstError(err, ssEnv.RemoveTempDir())
+	}
+	return ldb.ImportSnapshot(ss, replicaID)
+}
+
+func isCompleteSnapshotImage(ssfp string,
+	ss pb.Snapshot, fs vfs.IFS) (bool, error) {
+	checksum, err := rsm.GetV2PayloadChecksum(ssfp, fs)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(checksum, ss.Checksum), nil
+}
+
+// GetProcessedSnapshotRecord returns the snapshot record to be imported, file
+// paths are updated to be in dstDir and the membership is rewritten to the
+// specified members.
+func GetProcessedSnapshotRecord(dstDir string,
+	old pb.Snapshot, members map[uint64]string, fs vfs.IFS) pb.Snapshot {
+	for _, file := range old.Files {
+		file.Filepath = fs.PathJoin(dstDir, fs.PathBase(file.Filepath))
+	}
+	ss := pb.Snapshot{
+		Filepath: fs.PathJoin(dstDir, fs.PathBase(old.Filepath)),
+		FileSize: old.FileSize,
+		Index:    old.Index,
+		Term:     old.Term,
+		Checksum: old.Checksum,
+		Dummy:    old.Dummy,
+		Membership: pb.Membership{
+			ConfigChangeId: old.Index,
+			Removed:        make(map[uint64]bool),
+			NonVotings:     make(map[uint64]string),
+			Addresses:      make(map[uint64]string),
+			Witnesses:      make(map[uint64]string),
+		},
+		Files:    old.Files,
+		Type:     old.Type,
+		ShardID:  old.ShardID,
+		Imported: true,
+	}
+	for nid := range old.Membership.Addresses {
+		_, ok := members[nid]
+		if !ok {
+			ss.Membership.Removed[nid] = true
+		}
+	}
+	for nid := range old.Membership.NonVotings {
+		_, ok := members[nid]
+		if !ok {
+			ss.Membership.Removed[nid] = true
+		}
+	}
+	for nid := range old.Membership.Witnesses {
+		_, ok := members[nid]
+		if !ok {
+			ss.Membership.Removed[nid] = true
+		}
+	}
+	for nid := range old.Membership.Outgoing {
+		_, ok := members[nid]
+		if !ok {
+			ss.Membership.Removed[nid] = true
+		}
+	}
+	for nid := range old.Membership.Removed {
+		ss.Membership.Removed[nid] = true
+	}
+	ss.Membership.PrunedRemovedCount = old.Membership.PrunedRemovedCount
+	ss.Membership.PrunedRemovedHash = old.Membership.PrunedRemovedHash
+	ss.Membership.PrunedRemovedMax = old.Membership.PrunedRemovedMax
+	for nid, addr := range members {
+		ss.Membership.Addresses[nid] = addr
+	}
+	return ss
+}
+
+// GetClonedSnapshotRecord returns the snapshot record to be imported as the
+// snapshot of the specified shard. The cloned shard shares no history with the
+// shard that exported the snapshot, its membership only contains the specified
+// members.
+func GetClonedSnapshotRecord(ss pb.Snapshot,
+	shardID uint64, members map[uint64]string) pb.Snapshot {
+	ss.ShardID = shardID
+	ss.Membership = pb.Membership{
+		ConfigChangeId: ss.Index,
+		Removed:        make(map[uint64]bool),
+		NonVotings:     make(map[uint64]string),
+		Addresses:      make(map[uint64]string),
+		Witnesses:      make(map[uint64]string),
+	}
+	for nid, addr := range members {
+		ss.Membership.Addresses[nid] = addr
+	}
+	return ss
+}
+
+// stripSessions removes client sessions from the snapshot image fp and
+// updates the snapshot record accordingly.
+func stripSessions(ss *pb.Snapshot, fp string, fs vfs.IFS) error {
+	tmp := fp + ".stripped"
+	checksum, sz, err := rsm.StripSessions(fp, tmp, fs)
+	if err != nil {
+		return err
+	}
+	if err := rsm.ReplaceSnapshot(tmp, fp, fs); err != nil {
+		return err
+	}
+	ss.Checksum = checksum
+	ss.FileSize = sz
+	return nil
+}
+
+func copySnapshot(ss pb.Snapshot,
+	src ISource, dstDir string, fs vfs.IFS) error {
+	names := []string{fs.PathBase(ss.Filepath)}
+	for _, file := range ss.Files {
+		names = append(names, fs.PathBase(file.Filepath))
+	}
+	for _, name := range names {
+		if err := copyFile(src, name, fs.PathJoin(dstDir, name), fs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src ISource, name string, dst string, fs vfs.IFS) (err error) {
+	in, err := src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, in.Close())
+	}()
+	out, err := fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, out.Close())
+	}()
+	if runtime.GOOS != "windows" {
+		type stat interface {
+			Stat() (os.FileInfo, error)
+		}
+		type chmod interface {
+			Chmod(mode os.FileMode) error
+		}
+		sf, ok := in.(stat)
+		of, cok := out.(chmod)
+		if ok && cok {
+			fi, err := sf.Stat()
+			if err != nil {
+				return err
+			}
+			if err := of.Chmod(fi.Mode()); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return fileutil.SyncDir(fs.PathDir(dst), fs)
+}
@@ -213,8 +213,10 @@ func (be *batchedEntries) iterateBatches(shardID uint64,
 	lk.SetEntryBatchKey(shardID, replicaID, high)
 	expectedID := low
 	op := func(key []byte, data []byte) (bool, error) {
-		var eb pb.EntryBatch
-		pb.MustUnmarshal(&eb, data)
+		eb, err := decodeEntryBatch(data)
+		if err != nil {
+			return false, err
+		}
 		if getBatchID(eb.Entries[0].Index) != expectedID {
 			return false, nil
 		}
@@ -240,10 +242,9 @@ func (be *batchedEntries) getRange(shardID uint64,
 	firstIndex := uint64(0)
 	length := uint64(0)
 	op := func(key []byte, data []byte) (bool, error) {
-		var eb pb.EntryBatch
-		pb.MustUnmarshal(&eb, data)
-		if len(eb.Entries) == 0 {
-			panic("empty batch found")
+		eb, err := decodeEntryBatch(data)
+		if err != nil {
+			return false, err
 		}
 		if len(eb.Entries) > 1 {
 			eb = restoreBatchFields(eb)
@@ -351,12 +352,12 @@ func (be *batchedEntries) getBatchFromDB(shardID uint64,
 	k := be.keys.get()
 	defer k.Release()
 	k.SetEntryBatchKey(shardID, replicaID, batchID)
-	if err := be.kvs.GetValue(k.Key(), func(data []byte) error {
+	if err := be.kvs.GetValue(k.Key(), func(data []byte) (err error) {
 		if len(data) == 0 {
 			return errors.New("no such entry")
 		}
-		pb.MustUnmarshal(&e, data)
-		return nil
+		e, err = decodeEntryBatch(data)
+		return err
 	}); err != nil {
 		return e, false
 	}
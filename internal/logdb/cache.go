@@ -51,6 +51,19 @@ func (r *cache) setNodeInfo(shardID uint64, replicaID uint64) bool {
 	return !ok
 }
 
+// remove removes all cached records of the specified node, e.g. when the node
+// state is overwritten by an imported snapshot.
+func (r *cache) remove(shardID uint64, replicaID uint64) {
+	key := raftio.NodeInfo{ShardID: shardID, ReplicaID: replicaID}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.nodeInfo, key)
+	delete(r.ps, key)
+	delete(r.lastEntryBatch, key)
+	delete(r.maxIndex, key)
+	delete(r.snapshotIndex, key)
+}
+
 func (r *cache) setState(shardID uint64, replicaID uint64, st pb.State) bool {
 	key := raftio.NodeInfo{ShardID: shardID, ReplicaID: replicaID}
 	r.mu.Lock()
@@ -17,6 +17,7 @@ package logdb
 import (
 	"encoding/binary"
 	"math"
+	"sync"
 
 	"github.com/cockroachdb/errors"
 
@@ -52,6 +53,10 @@ type db struct {
 	keys    *keyPool
 	kvs     kv.IKVStore
 	entries entryManager
+	rs      *relaxedSync
+	// writeMu is read locked by writers, writes are paused when it is locked
+	// for creating checkpoints
+	writeMu sync.RWMutex
 }
 
 func hasEntryRecord(kvs kv.IKVStore, batched bool) (bool, error) {
@@ -95,6 +100,7 @@ func openRDB(config config.LogDBConfig,
 		keys:    pool,
 		kvs:     kvs,
 		entries: em,
+		rs:      newRelaxedSync(config),
 	}, nil
 }
 
@@ -115,6 +121,14 @@ func (r *db) close() error {
 	return r.kvs.Close()
 }
 
+func (r *db) checkpoint(dir string) error {
+	cp, ok := r.kvs.(kv.ICheckpointer)
+	if !ok {
+		return ErrCheckpointNotSupported
+	}
+	return cp.Checkpoint(dir)
+}
+
 func (r *db) getWriteBatch(ctx IContext) kv.IWriteBatch {
 	if ctx != nil {
 		wb := ctx.GetWriteBatch()
@@ -198,7 +212,7 @@ func (r *db) saveRaftState(updates []pb.Update, ctx IContext) error {
 	}
 	r.saveEntries(updates, wb, ctx)
 	if wb.Count() > 0 {
-		return r.kvs.CommitWriteBatch(wb)
+		return r.commitRaftState(wb, updates)
 	}
 	return nil
 }
@@ -237,7 +251,12 @@ func (r *db) importSnapshot(ss pb.Snapshot, replicaID uint64) error {
 		return err
 	}
 	r.saveMaxIndex(wb, ss.ShardID, replicaID, ss.Index, nil)
-	return r.kvs.CommitWriteBatch(wb)
+	if err := r.kvs.CommitWriteBatch(wb); err != nil {
+		return err
+	}
+	// records cached before the import are no longer valid
+	r.cs.remove(ss.ShardID, replicaID)
+	return nil
 }
 
 func (r *db) setMaxIndex(wb kv.IWriteBatch,
@@ -335,8 +354,7 @@ func (r *db) getBootstrapInfo(shardID uint64,
 		if len(data) == 0 {
 			return raftio.ErrNoBootstrapInfo
 		}
-		pb.MustUnmarshal(&bootstrap, data)
-		return nil
+		return decodeRecord(&bootstrap, data)
 	}); err != nil {
 		return pb.Bootstrap{}, err
 	}
@@ -389,7 +407,9 @@ func (r *db) listSnapshots(shardID uint64,
 	snapshots := make([]pb.Snapshot, 0)
 	op := func(key []byte, data []byte) (bool, error) {
 		var ss pb.Snapshot
-		pb.MustUnmarshal(&ss, data)
+		if err := decodeRecord(&ss, data); err != nil {
+			return false, err
+		}
 		snapshots = append(snapshots, ss)
 		return true, nil
 	}
@@ -407,12 +427,12 @@ func (r *db) getMaxIndex(shardID uint64, replicaID uint64) (uint64, error) {
 	defer k.Release()
 	k.SetMaxIndexKey(shardID, replicaID)
 	maxIndex := uint64(0)
-	if err := r.kvs.GetValue(k.Key(), func(data []byte) error {
+	if err := r.kvs.GetValue(k.Key(), func(data []byte) (err error) {
 		if len(data) == 0 {
 			return raftio.ErrNoSavedLog
 		}
-		maxIndex = binary.BigEndian.Uint64(data)
-		return nil
+		maxIndex, err = decodeMaxIndex(data)
+		return err
 	}); err != nil {
 		return 0, err
 	}
@@ -428,8 +448,7 @@ func (r *db) getState(shardID uint64, replicaID uint64) (pb.State, error) {
 		if len(data) == 0 {
 			return raftio.ErrNoSavedLog
 		}
-		pb.MustUnmarshal(&hs, data)
-		return nil
+		return decodeRecord(&hs, data)
 	}); err != nil {
 		return pb.State{}, err
 	}
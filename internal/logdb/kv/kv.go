@@ -41,6 +41,15 @@ type IWriteBatch interface {
 	Count() int
 }
 
+// ICheckpointer is the optional interface implemented by IKVStore types that
+// can create checkpoints of their data.
+type ICheckpointer interface {
+	// Checkpoint creates a consistent copy of the Key-Value store in the
+	// specified directory which must not exist. Files are hard linked when
+	// possible.
+	Checkpoint(dir string) error
+}
+
 // IKVStore is the interface used by the RDB struct to access the underlying
 // Key-Value store.
 type IKVStore interface {
@@ -68,6 +77,12 @@ type IKVStore interface {
 	// CommitWriteBatch atomically writes everything included in the write batch
 	// to the underlying key-value store.
 	CommitWriteBatch(wb IWriteBatch) error
+	// CommitWriteBatchNoSync atomically writes everything included in the
+	// write batch to the underlying key-value store without waiting for it to
+	// be synced to disk.
+	CommitWriteBatchNoSync(wb IWriteBatch) error
+	// Sync makes all previously committed writes durable.
+	Sync() error
 	// BulkRemoveEntries removes entries specified by the range [firstKey,
 	// lastKey). BulkRemoveEntries is called in the main execution thread of raft,
 	// it is supposed to immediately return without significant delay.
@@ -151,6 +151,7 @@ type KV struct {
 }
 
 var _ kv.IKVStore = (*KV)(nil)
+var _ kv.ICheckpointer = (*KV)(nil)
 
 var pebbleWarning sync.Once
 
@@ -266,6 +267,11 @@ func (r *KV) Close() error {
 	return nil
 }
 
+// Checkpoint creates a checkpoint of the KV store in the specified directory.
+func (r *KV) Checkpoint(dir string) error {
+	return r.db.Checkpoint(dir, pebble.WithFlushedWAL())
+}
+
 func iteratorIsValid(iter *pebble.Iterator) bool {
 	v := iter.Valid()
 	if err := iter.Error(); err != nil {
@@ -352,6 +358,24 @@ func (r *KV) CommitWriteBatch(wb kv.IWriteBatch) error {
 	return r.db.Apply(pwb.wb, r.wo)
 }
 
+// CommitWriteBatchNoSync ...
+func (r *KV) CommitWriteBatchNoSync(wb kv.IWriteBatch) error {
+	pwb, ok := wb.(*pebbleWriteBatch)
+	if !ok {
+		panic("unknown type")
+	}
+	if pwb.db != r.db {
+		panic("pwb.db != r.db")
+	}
+	return r.db.Apply(pwb.wb, pebble.NoSync)
+}
+
+// Sync ...
+func (r *KV) Sync() error {
+	// an empty log only record is written to have the WAL synced
+	return r.db.LogData(nil, pebble.Sync)
+}
+
 // BulkRemoveEntries ...
 func (r *KV) BulkRemoveEntries(fk []byte, lk []byte) (err error) {
 	wb := r.db.NewBatch()
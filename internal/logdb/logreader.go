@@ -64,6 +64,10 @@ type LogReader struct {
 	replicaID   uint64
 	markerTerm  uint64
 	length      uint64
+	// removedTo is the index up to which entries have been removed from the
+	// LogDB, entries in (removedTo, markerIndex] have been compacted but are
+	// still retained in the LogDB.
+	removedTo uint64
 }
 
 var _ raft.ILogDB = (*LogReader)(nil)
@@ -108,12 +112,54 @@ func (lr *LogReader) Entries(low uint64,
 	if err != nil {
 		return nil, err
 	}
+	return limitEntries(ents, size, maxSize), nil
+}
+
+func limitEntries(ents []pb.Entry, size uint64, maxSize uint64) []pb.Entry {
 	if maxSize > 0 && size > maxSize && len(ents) > 1 {
-		return ents[:len(ents)-1], nil
+		return ents[:len(ents)-1]
 	} else if maxSize == 0 && size > maxSize && len(ents) > 1 {
-		return ents[:1], nil
+		return ents[:1]
+	}
+	return ents
+}
+
+// RetainedEntries returns entries between [low, high) that have been compacted
+// but not yet removed from the LogDB with a total limit of up to maxSize
+// bytes. raft.ErrCompacted is returned when any requested entry is no longer
+// available.
+func (lr *LogReader) RetainedEntries(low uint64,
+	high uint64, maxSize uint64) ([]pb.Entry, error) {
+	lr.Lock()
+	defer lr.Unlock()
+	if low >= high || low <= lr.removedTo || high > lr.markerIndex+1 {
+		return nil, raft.ErrCompacted
+	}
+	maxEntries := maxEntrySliceSize / uint64(unsafe.Sizeof(pb.Entry{}))
+	if high-low > maxEntries {
+		high = low + maxEntries
+	}
+	ents := make([]pb.Entry, 0, high-low)
+	ents, size, err := lr.logdb.IterateEntries(ents, 0, lr.shardID,
+		lr.replicaID, low, high, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(ents) == 0 || ents[0].Index != low ||
+		(uint64(len(ents)) != high-low && size <= maxSize) {
+		return nil, raft.ErrCompacted
+	}
+	return limitEntries(ents, size, maxSize), nil
+}
+
+// SetRemovedTo marks entries up to index as removed from the LogDB, they are
+// no longer available from RetainedEntries.
+func (lr *LogReader) SetRemovedTo(index uint64) {
+	lr.Lock()
+	defer lr.Unlock()
+	if index > lr.removedTo {
+		lr.removedTo = index
 	}
-	return ents, nil
 }
 
 func (lr *LogReader) entries(low uint64,
@@ -234,6 +280,9 @@ func (lr *LogReader) ApplySnapshot(snapshot pb.Snapshot) error {
 	lr.markerIndex = snapshot.Index
 	lr.markerTerm = snapshot.Term
 	lr.length = 1
+	if snapshot.Index > lr.removedTo {
+		lr.removedTo = snapshot.Index
+	}
 	return nil
 }
 
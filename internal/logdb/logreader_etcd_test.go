@@ -198,6 +198,53 @@ func testLogReaderFirstIndex(t *testing.T, fs vfs.IFS) {
 	deleteTestDB(fs)
 }
 
+func TestLogReaderRetainedEntries(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	ents := []pb.Entry{{Index: 3, Term: 3}, {Index: 4, Term: 4},
+		{Index: 5, Term: 5}, {Index: 6, Term: 6}}
+	s := getTestLogReader(ents, fs)
+	defer deleteTestDB(fs)
+	defer s.logdb.Close()
+	s.SetRemovedTo(3)
+	if _, err := s.RetainedEntries(4, 6, math.MaxUint64); err != raft.ErrCompacted {
+		t.Errorf("entries not compacted yet returned, %v", err)
+	}
+	if err := s.Compact(5); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := s.Entries(4, 6, math.MaxUint64); err != raft.ErrCompacted {
+		t.Errorf("unexpected error %v", err)
+	}
+	entries, err := s.RetainedEntries(4, 6, math.MaxUint64)
+	if err != nil {
+		t.Fatalf("failed to get retained entries %v", err)
+	}
+	if !reflect.DeepEqual(entries, ents[1:3]) {
+		t.Errorf("entries = %v, want %v", entries, ents[1:3])
+	}
+	entries, err = s.RetainedEntries(4, 6, 0)
+	if err != nil {
+		t.Fatalf("failed to get retained entries %v", err)
+	}
+	if !reflect.DeepEqual(entries, ents[1:2]) {
+		t.Errorf("entries = %v, want %v", entries, ents[1:2])
+	}
+	if _, err := s.RetainedEntries(3, 6, math.MaxUint64); err != raft.ErrCompacted {
+		t.Errorf("removed entry returned, %v", err)
+	}
+	if _, err := s.RetainedEntries(4, 7, math.MaxUint64); err != raft.ErrCompacted {
+		t.Errorf("entry not compacted returned, %v", err)
+	}
+	s.SetRemovedTo(4)
+	if _, err := s.RetainedEntries(4, 6, math.MaxUint64); err != raft.ErrCompacted {
+		t.Errorf("removed entry returned, %v", err)
+	}
+	if _, err := s.RetainedEntries(5, 6, math.MaxUint64); err != nil {
+		t.Errorf("failed to get retained entries %v", err)
+	}
+}
+
 func TestLogReaderAppend(t *testing.T) {
 	fs := vfs.GetTestFS()
 	defer leaktest.AfterTest(t)()
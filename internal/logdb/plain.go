@@ -82,8 +82,10 @@ func (pe *plainEntries) iterate(ents []pb.Entry, maxIndex uint64,
 	lk.SetEntryKey(shardID, replicaID, high)
 	expectedIndex := low
 	op := func(key []byte, data []byte) (bool, error) {
-		var e pb.Entry
-		pb.MustUnmarshal(&e, data)
+		e, err := decodeEntry(data)
+		if err != nil {
+			return false, err
+		}
 		if e.Index != expectedIndex {
 			return false, nil
 		}
@@ -107,9 +109,9 @@ func (pe *plainEntries) getEntry(shardID uint64,
 	defer k.Release()
 	k.SetEntryKey(shardID, replicaID, index)
 	var e pb.Entry
-	op := func(data []byte) error {
-		pb.MustUnmarshal(&e, data)
-		return nil
+	op := func(data []byte) (err error) {
+		e, err = decodeEntry(data)
+		return err
 	}
 	if err := pe.kvs.GetValue(k.Key(), op); err != nil {
 		return pb.Entry{}, err
@@ -129,8 +131,10 @@ func (pe *plainEntries) getRange(shardID uint64,
 	length := uint64(0)
 	op := func(key []byte, data []byte) (bool, error) {
 		if firstIndex == 0 {
-			var e pb.Entry
-			pb.MustUnmarshal(&e, data)
+			e, err := decodeEntry(data)
+			if err != nil {
+				return false, err
+			}
 			firstIndex = e.Index
 			return false, nil
 		}
@@ -0,0 +1,64 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"encoding/binary"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// decodeRecord unmarshals the record read from the KV store into m, records
+// can be malformed after disk corruption, raftio.ErrCorruptedRecord is
+// returned in such case rather than panicking.
+func decodeRecord(m pb.Unmarshaler, data []byte) error {
+	if err := m.Unmarshal(data); err != nil {
+		return errors.Wrapf(raftio.ErrCorruptedRecord, "%v", err)
+	}
+	return nil
+}
+
+func decodeEntry(data []byte) (pb.Entry, error) {
+	var e pb.Entry
+	if err := decodeRecord(&e, data); err != nil {
+		return pb.Entry{}, err
+	}
+	return e, nil
+}
+
+// decodeEntryBatch unmarshals the entry batch record, batches are never saved
+// empty.
+func decodeEntryBatch(data []byte) (pb.EntryBatch, error) {
+	var eb pb.EntryBatch
+	if err := decodeRecord(&eb, data); err != nil {
+		return pb.EntryBatch{}, err
+	}
+	if len(eb.Entries) == 0 {
+		return pb.EntryBatch{}, errors.Wrapf(raftio.ErrCorruptedRecord,
+			"empty entry batch")
+	}
+	return eb, nil
+}
+
+func decodeMaxIndex(data []byte) (uint64, error) {
+	if len(data) != 8 {
+		return 0, errors.Wrapf(raftio.ErrCorruptedRecord,
+			"max index record size %d", len(data))
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
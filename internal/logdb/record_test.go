@@ -0,0 +1,95 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func TestDecodeRecordRejectsMalformedRecords(t *testing.T) {
+	e := pb.Entry{Index: 100, Term: 2, Cmd: []byte("test-data")}
+	data := pb.MustMarshal(&e)
+	if _, err := decodeEntry(data[:len(data)-1]); !errors.Is(err,
+		raftio.ErrCorruptedRecord) {
+		t.Errorf("truncated entry not rejected, %v", err)
+	}
+	if _, err := decodeEntryBatch(pb.MustMarshal(&pb.EntryBatch{})); !errors.Is(err,
+		raftio.ErrCorruptedRecord) {
+		t.Errorf("empty batch not rejected, %v", err)
+	}
+	if _, err := decodeMaxIndex([]byte{1, 2, 3}); !errors.Is(err,
+		raftio.ErrCorruptedRecord) {
+		t.Errorf("short max index not rejected, %v", err)
+	}
+	var ss pb.Snapshot
+	if err := decodeRecord(&ss, []byte{0x0a, 0xff}); !errors.Is(err,
+		raftio.ErrCorruptedRecord) {
+		t.Errorf("malformed snapshot not rejected, %v", err)
+	}
+}
+
+func FuzzLogDBRecord(f *testing.F) {
+	entries := []pb.Entry{
+		{Index: 100, Term: 2, Type: pb.ApplicationEntry, Cmd: []byte("test-data")},
+		{Index: 101, Term: 2, Type: pb.EncodedEntry, Cmd: make([]byte, 64)},
+		{Index: 102, Term: 3, Type: pb.ConfigChangeEntry, Key: 1, ClientID: 2},
+	}
+	f.Add(pb.MustMarshal(&entries[0]))
+	f.Add(pb.MustMarshal(&pb.EntryBatch{Entries: entries}))
+	f.Add(pb.MustMarshal(&pb.State{Term: 3, Vote: 2, Commit: 102}))
+	f.Add(pb.MustMarshal(&pb.Snapshot{
+		Index:    100,
+		Term:     2,
+		Filepath: "snapshot-0000000000000064",
+		FileSize: 1024,
+		Membership: pb.Membership{
+			Addresses: map[uint64]string{1: "a1", 2: "a2"},
+		},
+		Files: []*pb.SnapshotFile{{Filepath: "f1", FileSize: 1, FileId: 1}},
+	}))
+	f.Add(pb.MustMarshal(&pb.Bootstrap{
+		Addresses: map[uint64]string{1: "a1"},
+		Type:      pb.RegularStateMachine,
+	}))
+	f.Add(binary.BigEndian.AppendUint64(nil, 102))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		check := func(err error) {
+			if err != nil && !errors.Is(err, raftio.ErrCorruptedRecord) {
+				t.Fatalf("unexpected error type %v", err)
+			}
+		}
+		_, err := decodeEntry(data)
+		check(err)
+		eb, err := decodeEntryBatch(data)
+		check(err)
+		if err == nil && len(eb.Entries) > 1 {
+			restoreBatchFields(eb)
+		}
+		var st pb.State
+		check(decodeRecord(&st, data))
+		var ss pb.Snapshot
+		check(decodeRecord(&ss, data))
+		var bs pb.Bootstrap
+		check(decodeRecord(&bs, data))
+		_, err = decodeMaxIndex(data)
+		check(err)
+	})
+}
@@ -0,0 +1,139 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/logdb/kv"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	defaultRelaxedSyncInterval = 100 * time.Millisecond
+	defaultRelaxedSyncBytes    = 16 * 1024 * 1024
+)
+
+// relaxedSync tracks writes of shards in the RelaxedFsync mode committed to
+// the KV store without being synced to disk. seq is the number of such
+// commits, syncedSeq is the seq value when the last successful sync started.
+type relaxedSync struct {
+	mu        sync.Mutex
+	maxBytes  uint64
+	bytes     uint64
+	seq       uint64
+	syncedSeq uint64
+}
+
+func newRelaxedSync(cfg config.LogDBConfig) *relaxedSync {
+	maxBytes := cfg.RelaxedSyncBytes
+	if maxBytes == 0 {
+		maxBytes = defaultRelaxedSyncBytes
+	}
+	return &relaxedSync{maxBytes: maxBytes}
+}
+
+func getRelaxedSyncInterval(cfg config.LogDBConfig) time.Duration {
+	if cfg.RelaxedSyncIntervalMS == 0 {
+		return defaultRelaxedSyncInterval
+	}
+	return time.Duration(cfg.RelaxedSyncIntervalMS) * time.Millisecond
+}
+
+// committed records unsynced writes of the specified size, it returns a
+// boolean value indicating whether such writes are required to be synced
+// without further delay.
+func (s *relaxedSync) committed(sz uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	s.bytes += sz
+	return s.bytes >= s.maxBytes
+}
+
+// syncing returns a boolean value indicating whether there is any unsynced
+// write, together with the seq and the size of such writes to be passed to
+// synced once the sync completes.
+func (s *relaxedSync) syncing() (uint64, uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seq, s.bytes, s.seq != s.syncedSeq
+}
+
+// synced records that all writes up to the specified seq have been synced.
+// Writes committed while the sync was in progress are still considered as
+// unsynced.
+func (s *relaxedSync) synced(seq uint64, sz uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq > s.syncedSeq {
+		s.syncedSeq = seq
+		if sz > s.bytes {
+			sz = s.bytes
+		}
+		s.bytes -= sz
+	}
+}
+
+// isRelaxedFsync returns a boolean value indicating whether the updates can
+// be saved without being synced. Snapshot records are always synced, updates
+// changing the term or the vote of the replica are never marked as relaxed.
+func isRelaxedFsync(updates []pb.Update) bool {
+	for _, ud := range updates {
+		if !ud.RelaxedFsync || !pb.IsEmptySnapshot(ud.Snapshot) {
+			return false
+		}
+	}
+	return true
+}
+
+func getRelaxedFsyncSize(updates []pb.Update) uint64 {
+	sz := uint64(0)
+	for _, ud := range updates {
+		sz += uint64(ud.State.Size()) + pb.GetEntrySliceSize(ud.EntriesToSave)
+	}
+	return sz
+}
+
+// commitRaftState commits the write batch holding the specified updates, it
+// is synced unless all updates are in the RelaxedFsync mode.
+func (r *db) commitRaftState(wb kv.IWriteBatch, updates []pb.Update) error {
+	if !isRelaxedFsync(updates) {
+		return r.kvs.CommitWriteBatch(wb)
+	}
+	if err := r.kvs.CommitWriteBatchNoSync(wb); err != nil {
+		return err
+	}
+	if r.rs.committed(getRelaxedFsyncSize(updates)) {
+		return r.syncRelaxed()
+	}
+	return nil
+}
+
+// syncRelaxed syncs all writes committed without being synced. Such writes
+// are still considered as unsynced when the sync fails.
+func (r *db) syncRelaxed() error {
+	seq, sz, pending := r.rs.syncing()
+	if !pending {
+		return nil
+	}
+	if err := r.kvs.Sync(); err != nil {
+		return err
+	}
+	r.rs.synced(seq, sz)
+	return nil
+}
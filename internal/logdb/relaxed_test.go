@@ -0,0 +1,199 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/lni/goutils/leaktest"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func openRelaxedTestDB(t *testing.T, fs vfs.IFS,
+	interval uint64, maxBytes uint64) *ShardedDB {
+	// rooted so the creation of the dir is synced by the strict memfs
+	dir := fs.PathJoin("/", RDBTestDirectory, "db-dir")
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expert := config.GetDefaultExpertConfig()
+	expert.LogDB.Shards = 1
+	expert.LogDB.RelaxedSyncIntervalMS = interval
+	expert.LogDB.RelaxedSyncBytes = maxBytes
+	expert.FS = fs
+	db, err := NewLogDB(config.NodeHostConfig{Expert: expert}, nil,
+		[]string{dir}, []string{}, true, false, newDefaultKVStore)
+	if err != nil {
+		t.Fatalf("failed to open db %v", err)
+	}
+	return db.(*ShardedDB)
+}
+
+func saveRelaxedTestEntries(t *testing.T,
+	db *ShardedDB, first uint64, count uint64, relaxed bool) {
+	for i := first; i < first+count; i++ {
+		ud := pb.Update{
+			ShardID:       1,
+			ReplicaID:     1,
+			State:         pb.State{Term: 1, Commit: i},
+			EntriesToSave: []pb.Entry{{Term: 1, Index: i, Cmd: make([]byte, 16)}},
+			RelaxedFsync:  relaxed,
+		}
+		if err := db.SaveRaftState([]pb.Update{ud}, 1); err != nil {
+			t.Fatalf("failed to save raft state %v", err)
+		}
+	}
+}
+
+// crashRelaxedTestDB closes the db and discards all its unsynced writes as if
+// the host lost power, the reopened db is returned.
+func crashRelaxedTestDB(t *testing.T, db *ShardedDB, fs *vfs.MemFS,
+	interval uint64, maxBytes uint64) *ShardedDB {
+	fs.SetIgnoreSyncs(true)
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close db %v", err)
+	}
+	fs.ResetToSyncedState()
+	fs.SetIgnoreSyncs(false)
+	return openRelaxedTestDB(t, fs, interval, maxBytes)
+}
+
+func getRelaxedTestEntryCount(t *testing.T, db *ShardedDB) uint64 {
+	rs, err := db.ReadRaftState(1, 1, 0)
+	if errors.Is(err, raftio.ErrNoSavedLog) {
+		return 0
+	}
+	if err != nil {
+		t.Fatalf("failed to read raft state %v", err)
+	}
+	return rs.EntryCount
+}
+
+func TestRelaxedFsyncWritesAreBoundedByInterval(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tests := []struct {
+		relaxed  bool
+		interval uint64
+		wait     time.Duration
+		count    uint64
+	}{
+		// unsynced relaxed writes are lost
+		{true, 3600 * 1000, 0, 10},
+		// relaxed writes are synced once the interval elapsed
+		{true, 10, 100 * time.Millisecond, 20},
+		// strict writes are never lost
+		{false, 3600 * 1000, 0, 20},
+	}
+	for idx, tt := range tests {
+		func() {
+			fs := vfs.NewMemFS().(*vfs.MemFS)
+			db := openRelaxedTestDB(t, fs, 3600*1000, 1024*1024*1024)
+			saveRelaxedTestEntries(t, db, 1, 10, false)
+			db = crashRelaxedTestDB(t, db, fs, tt.interval, 1024*1024*1024)
+			saveRelaxedTestEntries(t, db, 11, 10, tt.relaxed)
+			time.Sleep(tt.wait)
+			db = crashRelaxedTestDB(t, db, fs, 3600*1000, 1024*1024*1024)
+			defer db.Close()
+			if v := getRelaxedTestEntryCount(t, db); v != tt.count {
+				t.Errorf("%d, %d entries, want %d", idx, v, tt.count)
+			}
+		}()
+	}
+}
+
+func TestRelaxedFsyncWritesAreBoundedBySize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMemFS().(*vfs.MemFS)
+	sz := getRelaxedFsyncSize([]pb.Update{{
+		State:         pb.State{Term: 1, Commit: 1},
+		EntriesToSave: []pb.Entry{{Term: 1, Index: 1, Cmd: make([]byte, 16)}},
+	}})
+	// synced once every 4 writes
+	maxBytes := 4 * sz
+	db := openRelaxedTestDB(t, fs, 3600*1000, maxBytes)
+	saveRelaxedTestEntries(t, db, 1, 10, true)
+	db = crashRelaxedTestDB(t, db, fs, 3600*1000, maxBytes)
+	defer db.Close()
+	if v := getRelaxedTestEntryCount(t, db); v != 8 {
+		t.Errorf("%d entries, want 8", v)
+	}
+}
+
+func TestRelaxedFsyncWritesAreSyncedOnClose(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMemFS().(*vfs.MemFS)
+	db := openRelaxedTestDB(t, fs, 3600*1000, 1024*1024*1024)
+	saveRelaxedTestEntries(t, db, 1, 10, true)
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close db %v", err)
+	}
+	fs.ResetToSyncedState()
+	db = openRelaxedTestDB(t, fs, 3600*1000, 1024*1024*1024)
+	defer db.Close()
+	if v := getRelaxedTestEntryCount(t, db); v != 10 {
+		t.Errorf("%d entries, want 10", v)
+	}
+}
+
+func TestUpdatesWithSnapshotAreNotRelaxed(t *testing.T) {
+	updates := []pb.Update{{RelaxedFsync: true}, {RelaxedFsync: true}}
+	if !isRelaxedFsync(updates) {
+		t.Errorf("unexpectedly not relaxed")
+	}
+	updates[1].Snapshot = pb.Snapshot{Index: 100, Term: 1}
+	if isRelaxedFsync(updates) {
+		t.Errorf("update with snapshot relaxed")
+	}
+	updates = []pb.Update{{RelaxedFsync: true}, {}}
+	if isRelaxedFsync(updates) {
+		t.Errorf("strict update relaxed")
+	}
+}
+
+func TestRelaxedWritesArePendingUntilSynced(t *testing.T) {
+	s := newRelaxedSync(config.LogDBConfig{RelaxedSyncBytes: 100})
+	if _, _, pending := s.syncing(); pending {
+		t.Errorf("unexpected pending writes")
+	}
+	s.committed(10)
+	seq, sz, pending := s.syncing()
+	if !pending || sz != 10 {
+		t.Fatalf("pending %t, size %d", pending, sz)
+	}
+	// failed syncs don't call synced, writes are still pending
+	if _, _, pending := s.syncing(); !pending {
+		t.Errorf("writes no longer pending")
+	}
+	// writes committed while syncing are not considered as synced
+	if !s.committed(95) {
+		t.Errorf("sync not required")
+	}
+	s.synced(seq, sz)
+	seq, sz, pending = s.syncing()
+	if !pending || sz != 95 {
+		t.Fatalf("pending %t, size %d", pending, sz)
+	}
+	s.synced(seq, sz)
+	if _, sz, pending := s.syncing(); pending || sz != 0 {
+		t.Errorf("pending %t, size %d", pending, sz)
+	}
+}
@@ -17,7 +17,9 @@ package logdb
 import (
 	"fmt"
 	"math"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/lni/goutils/syncutil"
@@ -46,6 +48,15 @@ var _ raftio.ILogDB = (*ShardedDB)(nil)
 
 var firstError = utils.FirstError
 
+var (
+	// ErrCheckpointNotSupported indicates that the underlying KV store can not
+	// create checkpoints.
+	ErrCheckpointNotSupported = errors.New("checkpoint not supported")
+	// ErrCheckpointTimeout indicates that the checkpoint could not be created
+	// within the max allowed pause of LogDB writes.
+	ErrCheckpointTimeout = errors.New("checkpoint pause timeout")
+)
+
 type shardCallback struct {
 	f     config.LogDBCallback
 	shard uint64
@@ -129,6 +140,9 @@ func OpenShardedDB(config config.NodeHostConfig, cb config.LogDBCallback,
 	mw.stopper.RunWorker(func() {
 		mw.compactionWorkerMain()
 	})
+	mw.stopper.RunWorker(func() {
+		mw.relaxedSyncWorkerMain()
+	})
 	return mw, nil
 }
 
@@ -181,6 +195,7 @@ func (s *ShardedDB) SaveRaftStateCtx(updates []pb.Update, ctx IContext) error {
 		return nil
 	}
 	p := s.getParititionID(updates)
+	defer s.lockWrite(p).RUnlock()
 	return errors.WithStack(s.shards[p].saveRaftState(updates, ctx))
 }
 
@@ -211,6 +226,7 @@ func (s *ShardedDB) SaveSnapshots(updates []pb.Update) error {
 		return nil
 	}
 	p := s.getParititionID(updates)
+	defer s.lockWrite(p).RUnlock()
 	return errors.WithStack(s.shards[p].saveSnapshots(updates))
 }
 
@@ -227,6 +243,7 @@ func (s *ShardedDB) GetSnapshot(shardID uint64,
 func (s *ShardedDB) SaveBootstrapInfo(shardID uint64,
 	replicaID uint64, bootstrap pb.Bootstrap) error {
 	p := s.partitioner.GetPartitionID(shardID)
+	defer s.lockWrite(p).RUnlock()
 	err := s.shards[p].saveBootstrapInfo(shardID, replicaID, bootstrap)
 	return errors.WithStack(err)
 }
@@ -255,6 +272,7 @@ func (s *ShardedDB) IterateEntries(ents []pb.Entry,
 func (s *ShardedDB) RemoveEntriesTo(shardID uint64,
 	replicaID uint64, index uint64) error {
 	p := s.partitioner.GetPartitionID(shardID)
+	defer s.lockWrite(p).RUnlock()
 	if err := s.shards[p].removeEntriesTo(shardID, replicaID, index); err != nil {
 		return errors.WithStack(err)
 	}
@@ -272,6 +290,7 @@ func (s *ShardedDB) CompactEntriesTo(shardID uint64,
 // RemoveNodeData deletes all node data that belongs to the specified node.
 func (s *ShardedDB) RemoveNodeData(shardID uint64, replicaID uint64) error {
 	p := s.partitioner.GetPartitionID(shardID)
+	defer s.lockWrite(p).RUnlock()
 	return errors.WithStack(s.shards[p].removeNodeData(shardID, replicaID))
 }
 
@@ -279,6 +298,7 @@ func (s *ShardedDB) RemoveNodeData(shardID uint64, replicaID uint64) error {
 // system.
 func (s *ShardedDB) ImportSnapshot(ss pb.Snapshot, replicaID uint64) error {
 	p := s.partitioner.GetPartitionID(ss.ShardID)
+	defer s.lockWrite(p).RUnlock()
 	return errors.WithStack(s.shards[p].importSnapshot(ss, replicaID))
 }
 
@@ -286,6 +306,7 @@ func (s *ShardedDB) ImportSnapshot(ss pb.Snapshot, replicaID uint64) error {
 func (s *ShardedDB) Close() (err error) {
 	s.stopper.Stop()
 	for _, v := range s.shards {
+		err = firstError(err, v.syncRelaxed())
 		err = firstError(err, v.close())
 	}
 	for _, v := range s.ctxs {
@@ -294,6 +315,71 @@ func (s *ShardedDB) Close() (err error) {
 	return err
 }
 
+// ShardCount returns the number of LogDB shards.
+func (s *ShardedDB) ShardCount() uint64 {
+	return uint64(len(s.shards))
+}
+
+// GetPartitionID returns the LogDB shard used for storing data of the
+// specified Raft shard.
+func (s *ShardedDB) GetPartitionID(shardID uint64) uint64 {
+	return s.partitioner.GetPartitionID(shardID)
+}
+
+// GetMaxIndex returns the max index of Raft log entries recorded for the
+// specified replica, raftio.ErrNoSavedLog is returned when there is no such
+// record.
+func (s *ShardedDB) GetMaxIndex(shardID uint64, replicaID uint64) (uint64, error) {
+	p := s.partitioner.GetPartitionID(shardID)
+	return s.shards[p].getMaxIndex(shardID, replicaID)
+}
+
+// Checkpoint creates a checkpoint of the specified LogDB shard in dir. Writes
+// to the LogDB shard are paused while the checkpoint is being created and the
+// specified paused func is being invoked. ErrCheckpointTimeout is returned
+// when they can not be completed within maxPause, writes are resumed once the
+// maxPause is reached in such case.
+func (s *ShardedDB) Checkpoint(shard uint64, dir string,
+	maxPause time.Duration, paused func() error) error {
+	if shard >= uint64(len(s.shards)) {
+		plog.Panicf("invalid LogDB shard %d", shard)
+	}
+	timer := time.NewTimer(maxPause)
+	defer timer.Stop()
+	db := s.shards[shard]
+	db.writeMu.Lock()
+	var once sync.Once
+	resume := func() {
+		once.Do(db.writeMu.Unlock)
+	}
+	defer resume()
+	done := make(chan error, 1)
+	go func() {
+		err := db.checkpoint(dir)
+		if err == nil {
+			err = paused()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return errors.WithStack(err)
+	case <-timer.C:
+		resume()
+		<-done
+		return ErrCheckpointTimeout
+	}
+}
+
+// lockWrite read locks the write mutex of the specified LogDB shard and
+// returns the mutex. The mutex is returned rather than its RUnlock method
+// value so deferring the unlock doesn't allocate on the write path.
+func (s *ShardedDB) lockWrite(p uint64) *sync.RWMutex {
+	mu := &s.shards[p].writeMu
+	mu.RLock()
+	return mu
+}
+
 func (s *ShardedDB) getParititionID(updates []pb.Update) uint64 {
 	pid := uint64(math.MaxUint64)
 	for _, ud := range updates {
@@ -328,6 +414,25 @@ func (s *ShardedDB) compactionWorkerMain() {
 	}
 }
 
+// relaxedSyncWorkerMain periodically syncs writes of shards in the
+// RelaxedFsync mode, see config.RelaxedFsync for details.
+func (s *ShardedDB) relaxedSyncWorkerMain() {
+	ticker := time.NewTicker(getRelaxedSyncInterval(s.config))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopper.ShouldStop():
+			return
+		case <-ticker.C:
+			for _, v := range s.shards {
+				if err := v.syncRelaxed(); err != nil {
+					panicNow(err)
+				}
+			}
+		}
+	}
+}
+
 func (s *ShardedDB) addCompaction(shardID uint64,
 	replicaID uint64, index uint64) chan struct{} {
 	task := task{
@@ -0,0 +1,109 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+// the leader throttles the replication to each peer that is more than
+// catchupLagEntries entries behind its last index. each throttled peer has a
+// token bucket refilled by catchupBytesPerTick bytes on each tick, it holds at
+// most catchupBytesPerTick bytes. a Replicate message is only sent to a
+// throttled peer when its bucket is not empty, the size of the message is
+// then taken from the bucket. as each message carries at least one entry, the
+// bucket can be overdrawn by at most one entry, overdrawn bytes are repaid on
+// following ticks. Replicate messages held back are sent on the next tick
+// with available tokens. snapshots are not throttled here.
+
+const (
+	defaultCatchupLagEntries uint64 = 1000
+)
+
+type catchupThrottle struct {
+	tokens int64
+	// throttled indicates whether the peer was lagging behind when it was last
+	// checked
+	throttled bool
+	// held indicates whether a Replicate message was held back
+	held bool
+}
+
+// setCatchupRate sets the number of bytes of entries that can be replicated
+// to each throttled peer per tick, 0 disables the throttling.
+func (r *raft) setCatchupRate(bytesPerTick uint64) {
+	r.catchupBytesPerTick = bytesPerTick
+}
+
+// isCatchupThrottled returns a boolean value indicating whether the
+// replication to the specified peer is throttled.
+func (r *raft) isCatchupThrottled(rp *remote) bool {
+	if r.catchupBytesPerTick == 0 || rp.state == remoteSnapshot {
+		rp.catchup.throttled = false
+	} else {
+		rp.catchup.throttled = rp.match+r.catchupLagEntries < r.log.lastIndex()
+	}
+	return rp.catchup.throttled
+}
+
+// acquireCatchupTokens returns the max size of the Replicate message to be
+// sent to the specified peer, false is returned when the message should be
+// held back.
+func (r *raft) acquireCatchupTokens(rp *remote) (uint64, bool) {
+	if !r.isCatchupThrottled(rp) {
+		rp.catchup.held = false
+		return maxEntrySize, true
+	}
+	if rp.catchup.tokens <= 0 {
+		rp.catchup.held = true
+		return 0, false
+	}
+	rp.catchup.held = false
+	return min(uint64(rp.catchup.tokens), maxEntrySize), true
+}
+
+// releaseCatchupTokens takes the size of the sent Replicate message from the
+// bucket of the specified peer.
+func (r *raft) releaseCatchupTokens(rp *remote, size uint64) {
+	if rp.catchup.throttled {
+		rp.catchup.tokens -= int64(size)
+	}
+}
+
+// refillCatchupTokens is called by the leader on each tick to refill the
+// buckets of throttled peers and to send held back Replicate messages.
+func (r *raft) refillCatchupTokens() {
+	if r.catchupBytesPerTick == 0 {
+		return
+	}
+	limit := int64(r.catchupBytesPerTick)
+	refill := func(remotes map[uint64]*remote) {
+		for id, rp := range remotes {
+			if id == r.replicaID {
+				continue
+			}
+			if !r.isCatchupThrottled(rp) {
+				rp.catchup = catchupThrottle{}
+				continue
+			}
+			rp.catchup.tokens += limit
+			if rp.catchup.tokens > limit {
+				rp.catchup.tokens = limit
+			}
+			if rp.catchup.held && rp.catchup.tokens > 0 {
+				r.sendReplicateMessage(id)
+			}
+		}
+	}
+	refill(r.remotes)
+	refill(r.nonVotings)
+	refill(r.witnesses)
+}
@@ -0,0 +1,151 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"testing"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	testCatchupBytesPerTick uint64 = 512
+)
+
+func newCatchupTestLeader(t *testing.T) *raft {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	for i := 0; i < 50; i++ {
+		ne(r.appendEntries([]pb.Entry{{Cmd: make([]byte, 100)}}), t)
+	}
+	r.setCatchupRate(testCatchupBytesPerTick)
+	r.catchupLagEntries = 5
+	lastIndex := r.log.lastIndex()
+	r.remotes[2].match = lastIndex
+	r.remotes[2].next = lastIndex + 1
+	r.remotes[2].becomeReplicate()
+	r.remotes[3].match = 0
+	r.remotes[3].next = 1
+	r.remotes[3].becomeReplicate()
+	r.msgs = nil
+	return r
+}
+
+func getReplicatedBytes(r *raft, to uint64) (uint64, int) {
+	size := uint64(0)
+	count := 0
+	for _, m := range r.msgs {
+		if m.Type == pb.Replicate && m.To == to {
+			size += getEntrySliceSize(m.Entries)
+			count++
+		}
+	}
+	return size, count
+}
+
+func getThrottledRemotes(r *raft) map[uint64]bool {
+	result := make(map[uint64]bool)
+	for _, rs := range r.getStatus().Remotes {
+		result[rs.ReplicaID] = rs.Throttled
+	}
+	return result
+}
+
+func TestLaggingPeerIsThrottled(t *testing.T) {
+	r := newCatchupTestLeader(t)
+	r.sendReplicateMessage(3)
+	if _, count := getReplicatedBytes(r, 3); count != 0 {
+		t.Fatalf("replicate message not held back")
+	}
+	if !r.remotes[3].catchup.throttled || !r.remotes[3].catchup.held {
+		t.Fatalf("unexpected throttle state %+v", r.remotes[3].catchup)
+	}
+	entrySize := getEntrySliceSize(mustGetEntries(t, r, 2, 2))
+	replicated := uint64(0)
+	ticks := 0
+	for r.remotes[3].match+r.catchupLagEntries < r.log.lastIndex() {
+		ticks++
+		if ticks > 100 {
+			t.Fatalf("peer failed to catch up")
+		}
+		r.msgs = nil
+		ne(r.tick(), t)
+		// the peer keeps asking for more entries
+		for i := 0; i < 10; i++ {
+			r.sendReplicateMessage(3)
+		}
+		size, _ := getReplicatedBytes(r, 3)
+		// the bucket can be overdrawn by at most one entry
+		if size > testCatchupBytesPerTick+entrySize {
+			t.Fatalf("replicated %d bytes in a tick, limit %d",
+				size, testCatchupBytesPerTick)
+		}
+		replicated += size
+		r.remotes[3].match = r.remotes[3].next - 1
+	}
+	limit := uint64(ticks)*testCatchupBytesPerTick + entrySize
+	if replicated > limit {
+		t.Errorf("replicated %d bytes in %d ticks, limit %d",
+			replicated, ticks, limit)
+	}
+	ne(r.tick(), t)
+	if r.remotes[3].catchup.throttled {
+		t.Errorf("peer still throttled after catching up")
+	}
+	if getThrottledRemotes(r)[3] {
+		t.Errorf("peer reported as throttled")
+	}
+}
+
+func TestHealthyPeerIsNotThrottled(t *testing.T) {
+	r := newCatchupTestLeader(t)
+	for i := 0; i < 10; i++ {
+		ne(r.appendEntries([]pb.Entry{{Cmd: make([]byte, 1000)}}), t)
+		r.msgs = nil
+		r.broadcastReplicateMessage()
+		if _, count := getReplicatedBytes(r, 2); count != 1 {
+			t.Fatalf("replicate message not sent to healthy peer")
+		}
+		r.remotes[2].match = r.log.lastIndex()
+	}
+	if r.remotes[2].catchup.throttled || !r.remotes[3].catchup.throttled {
+		t.Errorf("unexpected throttle states")
+	}
+	if throttled := getThrottledRemotes(r); throttled[2] || !throttled[3] {
+		t.Errorf("unexpected remote status %+v", r.getStatus().Remotes)
+	}
+}
+
+func TestCatchupThrottleIsDisabledByDefault(t *testing.T) {
+	r := newCatchupTestLeader(t)
+	r.setCatchupRate(0)
+	r.sendReplicateMessage(3)
+	if _, count := getReplicatedBytes(r, 3); count != 1 {
+		t.Errorf("replicate message not sent")
+	}
+	if r.remotes[3].catchup.throttled {
+		t.Errorf("peer throttled")
+	}
+}
+
+func mustGetEntries(t *testing.T,
+	r *raft, low uint64, high uint64) []pb.Entry {
+	ents, err := r.log.getEntries(low, high+1, maxEntrySize)
+	if err != nil {
+		t.Fatalf("failed to get entries %v", err)
+	}
+	return ents
+}
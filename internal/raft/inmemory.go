@@ -158,11 +158,67 @@ func (im *inMemory) appliedLogTo(index uint64) {
 	im.markerIndex = newMarkerIndex
 	im.resizeEntrySlice()
 	im.checkMarkerIndex()
-	if im.rateLimited() {
+	if im.tracked() {
 		im.rl.Decrease(getEntrySliceInMemSize(applied))
 	}
 }
 
+// tryRelease releases applied and saved entries from the in memory log when
+// its size is above the release threshold of the rate limiter. Released
+// entries are read from the LogDB when they are required later. Entries from
+// the keepFrom index might still be required by followers, they are only
+// released when releasing other entries is not enough. Entries not applied or
+// not saved yet are never released.
+func (im *inMemory) tryRelease(applied uint64, keepFrom uint64) {
+	if !im.rateLimited() || !im.rl.ReleaseRequired() {
+		return
+	}
+	releasable := min(applied, im.savedTo)
+	if keepFrom > im.markerIndex {
+		im.releaseTo(min(keepFrom-1, releasable))
+	}
+	if im.rl.ReleaseRequired() {
+		im.releaseTo(releasable)
+	}
+}
+
+func (im *inMemory) releaseTo(index uint64) {
+	if index < im.markerIndex || len(im.entries) == 0 {
+		return
+	}
+	index = min(index, im.entries[len(im.entries)-1].Index)
+	newMarkerIndex := index + 1
+	released := im.entries[:newMarkerIndex-im.markerIndex]
+	im.shrunk = true
+	im.entries = im.entries[newMarkerIndex-im.markerIndex:]
+	im.markerIndex = newMarkerIndex
+	im.resizeEntrySlice()
+	im.checkMarkerIndex()
+	im.rl.Decrease(getEntrySliceInMemSize(released))
+}
+
+// getRetention returns the size of entries kept in memory grouped by the
+// reason they can not be released. Entries up to the applied index are
+// releasable once saved, those from the keepFrom index are counted as required
+// by followers.
+func (im *inMemory) getRetention(applied uint64,
+	keepFrom uint64) server.InMemLogRetention {
+	offset := func(index uint64) uint64 {
+		if index < im.markerIndex {
+			return 0
+		}
+		return min(index-im.markerIndex, uint64(len(im.entries)))
+	}
+	saved := offset(im.savedTo + 1)
+	releasable := offset(min(applied, im.savedTo) + 1)
+	needed := min(offset(keepFrom), releasable)
+	return server.InMemLogRetention{
+		Unapplied:      getEntrySliceInMemSize(im.entries[releasable:saved]),
+		FollowerNeeded: getEntrySliceInMemSize(im.entries[needed:releasable]),
+		Unpersisted:    getEntrySliceInMemSize(im.entries[saved:]),
+	}
+}
+
 func (im *inMemory) savedSnapshotTo(index uint64) {
 	if idx, ok := im.getSnapshotIndex(); ok && idx == index {
 		im.snapshot = nil
@@ -202,7 +258,7 @@ func (im *inMemory) merge(ents []pb.Entry) {
 	if firstNewIndex == im.markerIndex+uint64(len(im.entries)) {
 		checkEntriesToAppend(im.entries, ents)
 		im.entries = append(im.entries, ents...)
-		if im.rateLimited() {
+		if im.tracked() {
 			im.rl.Increase(getEntrySliceInMemSize(ents))
 		}
 	} else if firstNewIndex <= im.markerIndex {
@@ -211,7 +267,7 @@ func (im *inMemory) merge(ents []pb.Entry) {
 		im.shrunk = false
 		im.entries = im.newEntrySlice(ents)
 		im.savedTo = firstNewIndex - 1
-		if im.rateLimited() {
+		if im.tracked() {
 			im.rl.Set(getEntrySliceInMemSize(ents))
 		}
 	} else {
@@ -221,7 +277,7 @@ func (im *inMemory) merge(ents []pb.Entry) {
 		im.entries = im.newEntrySlice(existing)
 		im.entries = append(im.entries, ents...)
 		im.savedTo = min(im.savedTo, firstNewIndex-1)
-		if im.rateLimited() {
+		if im.tracked() {
 			sz := getEntrySliceInMemSize(ents) + getEntrySliceInMemSize(existing)
 			im.rl.Set(sz)
 		}
@@ -237,11 +293,18 @@ func (im *inMemory) restore(ss pb.Snapshot) {
 	im.shrunk = false
 	im.entries = nil
 	im.savedTo = ss.Index
-	if im.rateLimited() {
+	if im.tracked() {
 		im.rl.Set(0)
 	}
 }
 
+// tracked returns a boolean value indicating whether the in memory log size is
+// recorded by the rate limiter. The size is recorded even when rate limiting
+// is disabled, it is accounted against the NodeHost memory budget.
+func (im *inMemory) tracked() bool {
+	return im.rl != nil
+}
+
 func (im *inMemory) rateLimited() bool {
 	return im.rl != nil && im.rl.Enabled()
 }
@@ -654,6 +654,104 @@ func TestRateLimitCanBeUpdatedAfterCutAndMergingEntries(t *testing.T) {
 	}
 }
 
+func getReleaseTestInMemory(maxSize uint64) *inMemory {
+	ents := []pb.Entry{
+		{Index: 2, Cmd: make([]byte, 100)},
+		{Index: 3, Cmd: make([]byte, 100)},
+		{Index: 4, Cmd: make([]byte, 100)},
+		{Index: 5, Cmd: make([]byte, 100)},
+	}
+	im := newInMemory(1, server.NewInMemRateLimiter(maxSize))
+	im.merge(ents)
+	im.savedLogTo(4, 0)
+	return &im
+}
+
+func TestSavedEntriesAreNotReleasedBelowThreshold(t *testing.T) {
+	im := getReleaseTestInMemory(10000)
+	im.tryRelease(4, 3)
+	if im.markerIndex != 2 || len(im.entries) != 4 {
+		t.Errorf("entries unexpectedly released")
+	}
+}
+
+func TestSavedEntriesAreReleasedWhenApproachingRateLimit(t *testing.T) {
+	im := getReleaseTestInMemory(1)
+	sz := getEntrySliceInMemSize(im.entries)
+	unsaved := getEntrySliceInMemSize(im.entries[3:])
+	im.rl = server.NewInMemRateLimiter(sz)
+	im.rl.Set(sz)
+	// releasing entries not required by followers is enough
+	im.tryRelease(4, 4)
+	if im.markerIndex != 4 || len(im.entries) != 2 {
+		t.Errorf("unexpected marker index %d", im.markerIndex)
+	}
+	if im.rl.Get() != getEntrySliceInMemSize(im.entries) {
+		t.Errorf("log size not updated")
+	}
+	// entries required by followers are released
+	im.rl = server.NewInMemRateLimiter(unsaved)
+	im.rl.Set(getEntrySliceInMemSize(im.entries))
+	im.tryRelease(4, 2)
+	if im.markerIndex != 5 || len(im.entries) != 1 {
+		t.Errorf("unexpected marker index %d", im.markerIndex)
+	}
+	// unsaved entries are never released
+	im.tryRelease(6, 6)
+	if im.markerIndex != 5 || len(im.entries) != 1 {
+		t.Errorf("unsaved entries released")
+	}
+	if im.rl.Get() != unsaved {
+		t.Errorf("log size %d, want %d", im.rl.Get(), unsaved)
+	}
+	if len(im.entriesToSave()) != 1 || im.entriesToSave()[0].Index != 5 {
+		t.Errorf("unexpected entries to save")
+	}
+}
+
+func TestUnappliedEntriesAreNotReleased(t *testing.T) {
+	im := getReleaseTestInMemory(1)
+	sz := getEntrySliceInMemSize(im.entries)
+	im.rl = server.NewInMemRateLimiter(1)
+	im.rl.Set(sz)
+	im.tryRelease(3, 6)
+	if im.markerIndex != 4 || len(im.entries) != 2 {
+		t.Errorf("unexpected marker index %d", im.markerIndex)
+	}
+	im.tryRelease(1, 6)
+	if im.markerIndex != 4 || len(im.entries) != 2 {
+		t.Errorf("unapplied entries released")
+	}
+}
+
+func TestInMemRetention(t *testing.T) {
+	im := getReleaseTestInMemory(10000)
+	sz := getEntrySliceInMemSize(im.entries[:1])
+	tests := []struct {
+		applied        uint64
+		keepFrom       uint64
+		unapplied      uint64
+		followerNeeded uint64
+	}{
+		{4, 1, 0, 3 * sz},
+		{4, 2, 0, 3 * sz},
+		{4, 3, 0, 2 * sz},
+		{4, 5, 0, 0},
+		{4, 6, 0, 0},
+		{10, 3, 0, 2 * sz},
+		{3, 2, sz, 2 * sz},
+		{3, 4, sz, 0},
+		{1, 1, 3 * sz, 0},
+	}
+	for idx, tt := range tests {
+		r := im.getRetention(tt.applied, tt.keepFrom)
+		if r.Unapplied != tt.unapplied || r.FollowerNeeded != tt.followerNeeded ||
+			r.Unpersisted != sz {
+			t.Errorf("%d, unexpected retention %+v", idx, r)
+		}
+	}
+}
+
 func TestResize(t *testing.T) {
 	im := inMemory{
 		markerIndex: 10,
@@ -718,3 +816,16 @@ func TestNewEntrySlice(t *testing.T) {
 		}
 	}
 }
+
+func TestLogSizeIsTrackedWhenNotRateLimited(t *testing.T) {
+	im := newInMemory(0, server.NewInMemRateLimiter(0))
+	ents := []pb.Entry{{Index: 1, Cmd: make([]byte, 1024)}}
+	im.merge(ents)
+	if im.rl.Get() != getEntrySliceInMemSize(ents) {
+		t.Errorf("log size %d, want %d", im.rl.Get(), getEntrySliceInMemSize(ents))
+	}
+	im.appliedLogTo(1)
+	if im.rl.Get() != 0 {
+		t.Errorf("log size not decreased")
+	}
+}
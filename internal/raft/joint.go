@@ -0,0 +1,228 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"sort"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// section 4.3 of the raft thesis describes the joint consensus approach for
+// arbitrary membership changes. the shard first transitions to a joint
+// configuration in which both the outgoing and the incoming set of regular
+// nodes are required to form quorums for elections and entry commitment. once
+// the EnterJoint entry is applied, the leader proposes a LeaveJoint entry on
+// its own to transition to the incoming configuration.
+// witnesses are never changed by joint consensus, they are counted in both
+// the outgoing and the incoming configurations. non-voting members listed as
+// regular nodes in the incoming configuration are promoted when entering the
+// joint configuration.
+// r.remotes contains all regular nodes in both configurations when the shard
+// is in a joint configuration.
+
+// jointConfig contains the regular nodes of the incoming and outgoing
+// configurations when the shard is in a joint configuration.
+type jointConfig struct {
+	incoming map[uint64]struct{}
+	outgoing map[uint64]struct{}
+}
+
+func newJointConfig(incoming map[uint64]string,
+	outgoing map[uint64]string) jointConfig {
+	jc := jointConfig{
+		incoming: make(map[uint64]struct{}, len(incoming)),
+		outgoing: make(map[uint64]struct{}, len(outgoing)),
+	}
+	for id := range incoming {
+		jc.incoming[id] = struct{}{}
+	}
+	for id := range outgoing {
+		jc.outgoing[id] = struct{}{}
+	}
+	return jc
+}
+
+func (r *raft) isJoint() bool {
+	return len(r.joint.outgoing) > 0
+}
+
+// restoreJoint restores the joint configuration from the membership recorded
+// in snapshots or LogDB.
+func (r *raft) restoreJoint(m pb.Membership) {
+	r.joint = jointConfig{}
+	if m.IsJoint() {
+		r.joint = newJointConfig(m.Addresses, m.Outgoing)
+	}
+}
+
+// configHasQuorum returns a boolean value indicating whether voting members
+// of the specified configuration accepted by f form a quorum.
+func (r *raft) configHasQuorum(nodes map[uint64]struct{},
+	f func(uint64) bool) bool {
+	c := 0
+	for id := range nodes {
+		if f(id) {
+			c++
+		}
+	}
+	for id := range r.witnesses {
+		if f(id) {
+			c++
+		}
+	}
+	return c >= (len(nodes)+len(r.witnesses))/2+1
+}
+
+// jointHasQuorum returns a boolean value indicating whether voting members
+// accepted by f form quorums in both the incoming and outgoing
+// configurations.
+func (r *raft) jointHasQuorum(f func(uint64) bool) bool {
+	return r.configHasQuorum(r.joint.incoming, f) &&
+		r.configHasQuorum(r.joint.outgoing, f)
+}
+
+// jointVoteResult returns whether the election has been won or lost when the
+// shard is in a joint configuration.
+func (r *raft) jointVoteResult() (bool, bool) {
+	won := r.jointHasQuorum(func(id uint64) bool {
+		v, ok := r.votes[id]
+		return ok && v
+	})
+	notRejected := func(id uint64) bool {
+		v, ok := r.votes[id]
+		return !ok || v
+	}
+	lost := !r.configHasQuorum(r.joint.incoming, notRejected) ||
+		!r.configHasQuorum(r.joint.outgoing, notRejected)
+	return won, lost
+}
+
+func (r *raft) configCommitIndex(nodes map[uint64]struct{}) uint64 {
+	matched := make([]uint64, 0, len(nodes)+len(r.witnesses))
+	for id := range nodes {
+		matched = append(matched, r.remotes[id].match)
+	}
+	for _, w := range r.witnesses {
+		matched = append(matched, w.match)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i] < matched[j]
+	})
+	return matched[len(matched)-(len(matched)/2+1)]
+}
+
+// jointCommitIndex returns the largest index replicated on quorums of both
+// the incoming and outgoing configurations.
+func (r *raft) jointCommitIndex() uint64 {
+	in := r.configCommitIndex(r.joint.incoming)
+	out := r.configCommitIndex(r.joint.outgoing)
+	if in < out {
+		return in
+	}
+	return out
+}
+
+func (r *raft) enterJoint(incoming map[uint64]string) error {
+	r.clearPendingConfigChange()
+	if r.isJoint() {
+		plog.Panicf("%s is already in joint config", r.describe())
+	}
+	outgoing := make(map[uint64]string, len(r.remotes))
+	for id := range r.remotes {
+		outgoing[id] = ""
+	}
+	for id := range incoming {
+		if _, ok := r.witnesses[id]; ok {
+			panic("could not promote witness to full member")
+		}
+		if _, ok := r.remotes[id]; ok {
+			continue
+		}
+		if rp, ok := r.nonVotings[id]; ok {
+			// promoting to full member with inherited progress info
+			r.deleteNonVoting(id)
+			r.remotes[id] = rp
+			if id == r.replicaID {
+				r.becomeFollower(r.term, r.leaderID)
+			}
+		} else {
+			r.setRemote(id, 0, r.log.lastIndex()+1)
+		}
+	}
+	r.joint = newJointConfig(incoming, outgoing)
+	plog.Infof("%s entered joint config, incoming %v, outgoing %v",
+		r.describe(), r.joint.incoming, r.joint.outgoing)
+	if r.isLeader() {
+		// LeaveJoint might have been proposed by the previous leader
+		if r.getPendingConfigChangeCount() > 0 {
+			r.setPendingConfigChange()
+			return nil
+		}
+		return r.proposeLeaveJoint()
+	}
+	return nil
+}
+
+func (r *raft) leaveJoint() error {
+	r.clearPendingConfigChange()
+	if !r.isJoint() {
+		plog.Panicf("%s is not in joint config", r.describe())
+	}
+	for id := range r.joint.outgoing {
+		if _, ok := r.joint.incoming[id]; ok {
+			continue
+		}
+		r.deleteRemote(id)
+		if r.leaderTransfering() && r.leaderTransferTarget == id {
+			r.abortLeaderTransfer()
+		}
+	}
+	r.joint = jointConfig{}
+	plog.Infof("%s left joint config", r.describe())
+	// step down as leader once it is removed
+	if r.selfRemoved() && r.isLeader() {
+		r.becomeFollower(r.term, NoLeader)
+	}
+	if r.isLeader() && r.numVotingMembers() > 0 {
+		ok, err := r.tryCommit()
+		if err != nil {
+			return err
+		}
+		if ok {
+			r.broadcastReplicateMessage()
+		}
+	}
+	return nil
+}
+
+// proposeLeaveJoint makes the leader propose the LeaveJoint config change
+// entry.
+func (r *raft) proposeLeaveJoint() error {
+	r.mustBeLeader()
+	cc := pb.ConfigChange{Type: pb.LeaveJoint}
+	if len(r.getUnsupported(cc, pb.ProtocolVersion)) == 0 {
+		cc.ProtocolVersion = pb.ProtocolVersion
+		cc.MaxRemoved = r.maxRemoved
+	}
+	entry := pb.Entry{Type: pb.ConfigChangeEntry, Cmd: pb.MustMarshal(&cc)}
+	r.setPendingConfigChange()
+	plog.Infof("%s proposing LeaveJoint", r.describe())
+	if err := r.appendEntries([]pb.Entry{entry}); err != nil {
+		return err
+	}
+	r.broadcastReplicateMessage()
+	return nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"reflect"
+	"testing"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func getJointTestMembers(ids ...uint64) map[uint64]string {
+	result := make(map[uint64]string)
+	for _, id := range ids {
+		result[id] = ""
+	}
+	return result
+}
+
+func getLeaveJointEntries(t *testing.T, r *raft) []pb.Entry {
+	ents, err := r.log.entries(r.log.firstIndex(), noLimit)
+	if err != nil {
+		t.Fatalf("failed to get entries %v", err)
+	}
+	result := make([]pb.Entry, 0)
+	for _, e := range ents {
+		if e.Type != pb.ConfigChangeEntry {
+			continue
+		}
+		var cc pb.ConfigChange
+		pb.MustUnmarshal(&cc, e.Cmd)
+		if cc.Type == pb.LeaveJoint {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func TestLeaderProposesLeaveJointAfterEnteringJoint(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	ne(r.enterJoint(getJointTestMembers(1, 4, 5)), t)
+	if !r.isJoint() {
+		t.Fatalf("not in joint config")
+	}
+	if g := r.nodesSorted(); !reflect.DeepEqual(g, []uint64{1, 2, 3, 4, 5}) {
+		t.Errorf("nodes %v, want [1 2 3 4 5]", g)
+	}
+	if !r.hasPendingConfigChange() {
+		t.Errorf("pending config change not set")
+	}
+	if len(getLeaveJointEntries(t, r)) != 1 {
+		t.Errorf("LeaveJoint not proposed")
+	}
+	ne(r.leaveJoint(), t)
+	if r.isJoint() || r.hasPendingConfigChange() {
+		t.Errorf("still in joint config")
+	}
+	if g := r.nodesSorted(); !reflect.DeepEqual(g, []uint64{1, 4, 5}) {
+		t.Errorf("nodes %v, want [1 4 5]", g)
+	}
+}
+
+func TestJointConfigCommitRequiresQuorumsOfBothConfigs(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	ne(r.enterJoint(getJointTestMembers(1, 4, 5)), t)
+	committed := r.log.committed
+	last := r.log.lastIndex()
+	r.remotes[1].match = last
+	r.remotes[2].match = last
+	r.remotes[3].match = last
+	ok, err := r.tryCommit()
+	ne(err, t)
+	if ok || r.log.committed != committed {
+		t.Errorf("committed without a quorum of the incoming config")
+	}
+	r.remotes[4].match = last
+	ok, err = r.tryCommit()
+	ne(err, t)
+	if !ok || r.log.committed != last {
+		t.Errorf("committed %d, want %d", r.log.committed, last)
+	}
+}
+
+func TestJointConfigElectionRequiresQuorumsOfBothConfigs(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+	ne(r.enterJoint(getJointTestMembers(1, 4, 5)), t)
+	r.becomeCandidate()
+	r.handleVoteResp(1, false, false)
+	r.handleVoteResp(2, false, false)
+	r.handleVoteResp(3, false, false)
+	if won, lost := r.voteResult(3); won || lost {
+		t.Errorf("won %t, lost %t, want undecided", won, lost)
+	}
+	r.handleVoteResp(4, false, false)
+	if won, _ := r.voteResult(4); !won {
+		t.Errorf("failed to win the election")
+	}
+	r.becomeCandidate()
+	r.handleVoteResp(1, false, false)
+	r.handleVoteResp(2, false, false)
+	r.handleVoteResp(4, true, false)
+	r.handleVoteResp(5, true, false)
+	if _, lost := r.voteResult(2); !lost {
+		t.Errorf("election not lost")
+	}
+}
+
+func TestJointConfigCanBeRestored(t *testing.T) {
+	m := pb.Membership{
+		Addresses: getJointTestMembers(1, 4, 5),
+		Outgoing:  getJointTestMembers(1, 2, 3),
+	}
+	r := newTestRaft(1, nil, 10, 1, NewTestLogDB())
+	r.restoreRemotes(pb.Snapshot{Index: 1, Term: 1, Membership: m})
+	if !r.isJoint() {
+		t.Fatalf("joint config not restored")
+	}
+	if g := r.nodesSorted(); !reflect.DeepEqual(g, []uint64{1, 2, 3, 4, 5}) {
+		t.Errorf("nodes %v, want [1 2 3 4 5]", g)
+	}
+}
+
+// TestLeaderCrashInJointConfig tests that the new leader elected in the joint
+// config proposes the LeaveJoint entry when the previous leader crashed
+// before getting it replicated.
+func TestLeaderCrashInJointConfig(t *testing.T) {
+	peers := make(map[uint64]stateMachine)
+	rafts := make(map[uint64]*raft)
+	for id := uint64(1); id <= 5; id++ {
+		r := newTestRaft(id, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+		peers[id] = r
+		rafts[id] = r
+	}
+	nw := &network{
+		peers:   peers,
+		dropm:   make(map[connem]float64),
+		ignorem: make(map[pb.MessageType]bool),
+	}
+	nw.send(pb.Message{From: 1, To: 1, Type: pb.Election})
+	if !rafts[1].isLeader() {
+		t.Fatalf("node 1 is not the leader")
+	}
+	incoming := getJointTestMembers(2, 4, 5)
+	cc := pb.ConfigChange{Type: pb.EnterJoint, Members: incoming}
+	nw.send(pb.Message{
+		From:    1,
+		To:      1,
+		Type:    pb.Propose,
+		Entries: []pb.Entry{{Type: pb.ConfigChangeEntry, Cmd: pb.MustMarshal(&cc)}},
+	})
+	for id := uint64(1); id <= 3; id++ {
+		if rafts[id].log.committed != rafts[1].log.lastIndex() {
+			t.Fatalf("EnterJoint not committed on node %d", id)
+		}
+	}
+	// the leader crashed right after applying the EnterJoint entry
+	nw.isolate(1)
+	for id := uint64(1); id <= 3; id++ {
+		ne(rafts[id].enterJoint(incoming), t)
+		rafts[id].log.processed = rafts[id].log.committed
+	}
+	nw.send(pb.Message{From: 2, To: 2, Type: pb.Election})
+	r := rafts[2]
+	if !r.isLeader() {
+		t.Fatalf("node 2 is not the leader")
+	}
+	ents := getLeaveJointEntries(t, r)
+	if len(ents) != 1 {
+		t.Fatalf("LeaveJoint not proposed by the new leader")
+	}
+	if r.log.committed < ents[0].Index {
+		t.Fatalf("LeaveJoint not committed")
+	}
+	for id := uint64(2); id <= 5; id++ {
+		if rafts[id].log.committed < ents[0].Index {
+			t.Errorf("LeaveJoint not committed on node %d", id)
+		}
+	}
+	ne(r.leaveJoint(), t)
+	if r.isJoint() || !r.isLeader() {
+		t.Errorf("unexpected state")
+	}
+	if g := r.nodesSorted(); !reflect.DeepEqual(g, []uint64{2, 4, 5}) {
+		t.Errorf("nodes %v, want [2 4 5]", g)
+	}
+}
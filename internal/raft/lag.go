@@ -0,0 +1,112 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"github.com/lni/dragonboat/v4/internal/server"
+)
+
+// the leader checks how far behind each non-voting member is on each tick. a
+// non-voting member is considered as lagging once it has been more than
+// lagAlertEntries entries behind the leader's last index for more than
+// lagAlertTimeout ticks, events are published when it starts and stops
+// lagging. the check is restarted whenever a new leader is elected.
+
+type nonVotingLag struct {
+	elapsed uint64
+	lagging bool
+}
+
+func (r *raft) resetNonVotingLags() {
+	r.nonVotingLags = make(map[uint64]*nonVotingLag)
+}
+
+// getNonVotingLag returns the number of entries the specified non-voting
+// member is behind the leader's last index together with its match index.
+func (r *raft) getNonVotingLag(rp *remote) (uint64, uint64) {
+	lastIndex := r.log.lastIndex()
+	if rp.match >= lastIndex {
+		return 0, rp.match
+	}
+	return lastIndex - rp.match, rp.match
+}
+
+// checkNonVotingLag is called by the leader on each tick to publish events
+// when non-voting members start or stop lagging behind.
+func (r *raft) checkNonVotingLag() {
+	if r.lagAlertEntries == 0 || !r.isLeader() {
+		return
+	}
+	for id := range r.nonVotingLags {
+		if _, ok := r.nonVotings[id]; !ok {
+			delete(r.nonVotingLags, id)
+		}
+	}
+	for id, rp := range r.nonVotings {
+		l, ok := r.nonVotingLags[id]
+		if !ok {
+			l = &nonVotingLag{}
+			r.nonVotingLags[id] = l
+		}
+		lag, match := r.getNonVotingLag(rp)
+		if lag <= r.lagAlertEntries {
+			l.elapsed = 0
+			if l.lagging {
+				l.lagging = false
+				plog.Infof("%s nonVoting %s caught up, match %d",
+					r.describe(), ReplicaID(id), match)
+				if r.events != nil {
+					r.events.NonVotingLagRecovered(r.getNonVotingLagInfo(id, match, lag))
+				}
+			}
+			continue
+		}
+		l.elapsed++
+		if !l.lagging && l.elapsed > r.lagAlertTimeout {
+			l.lagging = true
+			plog.Warningf("%s nonVoting %s lagging behind, match %d, lag %d",
+				r.describe(), ReplicaID(id), match, lag)
+			if r.events != nil {
+				r.events.NonVotingLagging(r.getNonVotingLagInfo(id, match, lag))
+			}
+		}
+	}
+}
+
+func (r *raft) getNonVotingLagInfo(replicaID uint64,
+	match uint64, lag uint64) server.NonVotingLagInfo {
+	return server.NonVotingLagInfo{
+		ShardID:            r.shardID,
+		ReplicaID:          r.replicaID,
+		NonVotingReplicaID: replicaID,
+		Match:              match,
+		Lag:                lag,
+	}
+}
+
+// getNonVotingProgress returns the match index and the lag of all non-voting
+// members known to the leader, nil is returned when the local node is not
+// the leader.
+func (r *raft) getNonVotingProgress() map[uint64]server.NonVotingLagInfo {
+	if !r.isLeader() {
+		return nil
+	}
+	result := make(map[uint64]server.NonVotingLagInfo, len(r.nonVotings))
+	for id, rp := range r.nonVotings {
+		lag, match := r.getNonVotingLag(rp)
+		result[id] = r.getNonVotingLagInfo(id, match, lag)
+	}
+	return result
+}
@@ -0,0 +1,102 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"testing"
+
+	"github.com/lni/dragonboat/v4/internal/server"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+type testLagListener struct {
+	server.IRaftEventListener
+	lagging   []server.NonVotingLagInfo
+	recovered []server.NonVotingLagInfo
+}
+
+func (l *testLagListener) NonVotingLagging(info server.NonVotingLagInfo) {
+	l.lagging = append(l.lagging, info)
+}
+
+func (l *testLagListener) NonVotingLagRecovered(info server.NonVotingLagInfo) {
+	l.recovered = append(l.recovered, info)
+}
+
+func newLagTestLeader(t *testing.T) (*raft, *testLagListener) {
+	r := newTestRaft(1, []uint64{1}, 10, 1, NewTestLogDB())
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	r.setNonVoting(2, 0, 1)
+	r.lagAlertEntries = 2
+	r.lagAlertTimeout = 1
+	l := &testLagListener{}
+	r.events = l
+	for i := 0; i < 5; i++ {
+		ne(r.appendEntries([]pb.Entry{{Cmd: []byte("test-data")}}), t)
+	}
+	return r, l
+}
+
+func TestNonVotingLagIsReported(t *testing.T) {
+	r, l := newLagTestLeader(t)
+	ne(r.tick(), t)
+	if len(l.lagging) != 0 {
+		t.Fatalf("lagging reported too early")
+	}
+	ne(r.tick(), t)
+	ne(r.tick(), t)
+	if len(l.lagging) != 1 {
+		t.Fatalf("unexpected lagging events %v", l.lagging)
+	}
+	info := l.lagging[0]
+	if info.NonVotingReplicaID != 2 || info.Lag != r.log.lastIndex() {
+		t.Errorf("unexpected info %+v", info)
+	}
+	r.nonVotings[2].match = r.log.lastIndex() - 1
+	ne(r.tick(), t)
+	ne(r.tick(), t)
+	if len(l.recovered) != 1 || l.recovered[0].Lag != 1 {
+		t.Fatalf("unexpected recovered events %v", l.recovered)
+	}
+	if len(l.lagging) != 1 {
+		t.Errorf("unexpected lagging events %v", l.lagging)
+	}
+}
+
+func TestNonVotingLagCheckIsDisabledByDefault(t *testing.T) {
+	r, l := newLagTestLeader(t)
+	r.lagAlertEntries = 0
+	for i := 0; i < 5; i++ {
+		ne(r.tick(), t)
+	}
+	if len(l.lagging) != 0 {
+		t.Errorf("unexpected lagging events %v", l.lagging)
+	}
+}
+
+func TestNonVotingProgressIsOnlyAvailableOnLeader(t *testing.T) {
+	r, _ := newLagTestLeader(t)
+	r.nonVotings[2].match = 3
+	p := r.getNonVotingProgress()
+	if len(p) != 1 || p[2].Match != 3 || p[2].Lag != r.log.lastIndex()-3 {
+		t.Errorf("unexpected progress %v", p)
+	}
+	r.events = nil
+	r.becomeFollower(r.term+1, NoLeader)
+	if r.getNonVotingProgress() != nil {
+		t.Errorf("progress returned by follower")
+	}
+}
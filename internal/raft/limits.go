@@ -0,0 +1,66 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// the number of witnesses and non-voting members are limited by the leader
+// before appending the config change entry. as the limits are configured on
+// each replica, config change entries exceeding the leader's limits are
+// marked and they are rejected by all replicas when applied.
+
+const (
+	defaultMaxWitnesses uint64 = 1
+	// defaultMaxRemovedReplicas is the default number of removed replica IDs
+	// kept in the membership, it is included in config changes removing
+	// replicas so all replicas prune the same removed replica IDs.
+	defaultMaxRemovedReplicas uint64 = 1024
+)
+
+// exceedsMembershipLimits returns a boolean value indicating whether the
+// membership resulted from the config change would have too many witnesses
+// or non-voting members.
+func (r *raft) exceedsMembershipLimits(cc pb.ConfigChange) bool {
+	witnesses := len(r.witnesses)
+	voters := len(r.remotes)
+	switch cc.Type {
+	case pb.AddWitness:
+		if _, ok := r.witnesses[cc.ReplicaID]; ok {
+			return false
+		}
+		witnesses++
+		if uint64(witnesses) > r.maxWitnesses {
+			return true
+		}
+	case pb.AddNonVoting:
+		if _, ok := r.nonVotings[cc.ReplicaID]; ok || r.maxNonVotings == 0 {
+			return false
+		}
+		return uint64(len(r.nonVotings)+1) > r.maxNonVotings
+	case pb.RemoveNode:
+		if _, ok := r.remotes[cc.ReplicaID]; !ok {
+			return false
+		}
+		voters--
+	case pb.EnterJoint:
+		voters = len(cc.Members)
+	default:
+		return false
+	}
+	// witnesses are never allowed to outnumber regular nodes
+	return witnesses > voters
+}
@@ -0,0 +1,129 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"testing"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func TestWitnessesAreLimited(t *testing.T) {
+	r := newActiveTestLeader(t, []uint64{1, 2, 3})
+	if r.maxWitnesses != defaultMaxWitnesses {
+		t.Errorf("unexpected max witnesses %d", r.maxWitnesses)
+	}
+	cc := proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.AddWitness, ReplicaID: 4})
+	if cc.LimitExceeded {
+		t.Errorf("witness addition unexpectedly limited")
+	}
+	r.addWitness(4)
+	cc = proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.AddWitness, ReplicaID: 5})
+	if !cc.LimitExceeded {
+		t.Errorf("witness addition not limited")
+	}
+	r.maxWitnesses = 3
+	cc = proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.AddWitness, ReplicaID: 5})
+	if cc.LimitExceeded {
+		t.Errorf("witness addition unexpectedly limited")
+	}
+	r.addWitness(5)
+	// witnesses can not outnumber regular nodes
+	cc = proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.AddWitness, ReplicaID: 6})
+	if cc.LimitExceeded {
+		t.Errorf("witness addition unexpectedly limited")
+	}
+	r.addWitness(6)
+	cc = proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.AddWitness, ReplicaID: 7})
+	if !cc.LimitExceeded {
+		t.Errorf("witness addition not limited")
+	}
+}
+
+func TestRemovingNodeCanNotLeaveWitnessesOutnumberingNodes(t *testing.T) {
+	r := newActiveTestLeader(t, []uint64{1, 2})
+	r.addWitness(3)
+	cc := proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 2, Force: true})
+	if cc.LimitExceeded {
+		t.Errorf("node removal unexpectedly limited")
+	}
+	r.addWitness(4)
+	r.maxWitnesses = 2
+	cc = proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 2, Force: true})
+	if !cc.LimitExceeded {
+		t.Errorf("node removal not limited")
+	}
+	cc = proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 4})
+	if cc.LimitExceeded {
+		t.Errorf("witness removal unexpectedly limited")
+	}
+	cc = proposeTestConfigChange(t, r, pb.ConfigChange{
+		Type:    pb.EnterJoint,
+		Members: map[uint64]string{1: "a1"},
+	})
+	if !cc.LimitExceeded {
+		t.Errorf("reconfiguration not limited")
+	}
+}
+
+func TestNonVotingsAreLimited(t *testing.T) {
+	r := newActiveTestLeader(t, []uint64{1, 2, 3})
+	for i := uint64(4); i < 10; i++ {
+		cc := proposeTestConfigChange(t, r,
+			pb.ConfigChange{Type: pb.AddNonVoting, ReplicaID: i})
+		if cc.LimitExceeded {
+			t.Fatalf("nonVoting addition unexpectedly limited")
+		}
+		r.addNonVoting(i)
+	}
+	r.maxNonVotings = 7
+	cc := proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.AddNonVoting, ReplicaID: 10})
+	if cc.LimitExceeded {
+		t.Errorf("nonVoting addition unexpectedly limited")
+	}
+	r.addNonVoting(10)
+	cc = proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.AddNonVoting, ReplicaID: 11})
+	if !cc.LimitExceeded {
+		t.Errorf("nonVoting addition not limited")
+	}
+}
+
+func TestRemovedReplicaLimitIsSpecifiedByTheLeader(t *testing.T) {
+	r := newActiveTestLeader(t, []uint64{1, 2, 3})
+	if r.maxRemoved != defaultMaxRemovedReplicas {
+		t.Errorf("unexpected max removed %d", r.maxRemoved)
+	}
+	r.maxRemoved = 16
+	cc := proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 3, MaxRemoved: 100})
+	if cc.MaxRemoved != 16 {
+		t.Errorf("unexpected max removed %d", cc.MaxRemoved)
+	}
+	cc = proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.AddNonVoting, ReplicaID: 4})
+	if cc.MaxRemoved != 0 {
+		t.Errorf("unexpected max removed %d", cc.MaxRemoved)
+	}
+}
@@ -28,6 +28,9 @@ type TestLogDB struct {
 	markerTerm  uint64
 	snapshot    pb.Snapshot
 	state       pb.State
+	// retained are compacted entries kept when retain is true.
+	retained []pb.Entry
+	retain   bool
 }
 
 func NewTestLogDB() ILogDB {
@@ -56,6 +59,7 @@ func (db *TestLogDB) ApplySnapshot(ss pb.Snapshot) error {
 	db.markerIndex = ss.Index
 	db.markerTerm = ss.Term
 	db.entries = make([]pb.Entry, 0)
+	db.retained = nil
 	return nil
 }
 
@@ -170,8 +174,22 @@ func (db *TestLogDB) Compact(index uint64) error {
 		return err
 	}
 	cut := index - db.markerIndex
+	if db.retain {
+		db.retained = append(db.retained, db.entries[:cut]...)
+	}
 	db.entries = db.entries[cut:]
 	db.markerIndex = index
 	db.markerTerm = term
 	return nil
 }
+
+func (db *TestLogDB) RetainedEntries(low uint64,
+	high uint64, maxSize uint64) ([]pb.Entry, error) {
+	if len(db.retained) == 0 || low < db.retained[0].Index ||
+		high > db.markerIndex+1 || low >= high {
+		return nil, ErrCompacted
+	}
+	first := db.retained[0].Index
+	ents := db.retained[low-first : high-first]
+	return limitSize(ents, maxSize), nil
+}
@@ -61,6 +61,10 @@ type ILogDB interface {
 	// Entries returns entries between [low, high) with total size of entries
 	// limited to maxSize bytes.
 	Entries(low uint64, high uint64, maxSize uint64) ([]pb.Entry, error)
+	// RetainedEntries returns entries between [low, high) that have been
+	// compacted but are still retained in the persistent storage, with total
+	// size of entries limited to maxSize bytes.
+	RetainedEntries(low uint64, high uint64, maxSize uint64) ([]pb.Entry, error)
 	// Snapshot returns the metadata for the most recent snapshot known to the
 	// LogDB.
 	Snapshot() pb.Snapshot
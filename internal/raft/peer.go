@@ -74,9 +74,45 @@ func Launch(config config.Config,
 		p.raft.becomeFollower(1, NoLeader)
 		bootstrap(p.raft, addresses)
 	}
+	if !initial && newNode && isVolatile(config) {
+		// the restarted Volatile replica lost its log, or it is joining the shard
+		p.raft.logLost = true
+	}
 	return p
 }
 
+// SetRandomSource replaces the source of randomness used for randomizing the
+// election timeout, it allows the Raft node to be stepped deterministically in
+// tests. It must be invoked right after Launch, the election timeout is
+// randomized again using the specified source.
+func (p *Peer) SetRandomSource(f func() uint64) {
+	p.raft.random = f
+	p.raft.setRandomizedElectionTimeout()
+}
+
+// DisableCampaign prevents the Raft node from campaigning to become the
+// leader, election timeouts and leader transfers targeting the node are
+// ignored. It must be invoked right after Launch.
+func (p *Peer) DisableCampaign() {
+	p.raft.campaignDisabled = true
+}
+
+// SetLogLost marks the Raft log of the node as lost, e.g. when it is a promoted
+// witness that dropped its witness log. The node doesn't vote or campaign until
+// it catches up with the commit index of the leader. It must be invoked right
+// after Launch.
+func (p *Peer) SetLogLost() {
+	p.raft.logLost = true
+}
+
+// SetCatchupRate sets the number of bytes of entries the leader replicates
+// to each peer catching up per tick, see
+// config.Config.MaxCatchupBytesPerSecond for details. It must be invoked right
+// after Launch.
+func (p *Peer) SetCatchupRate(bytesPerTick uint64) {
+	p.raft.setCatchupRate(bytesPerTick)
+}
+
 // Tick moves the logical clock forward by one tick.
 func (p *Peer) Tick() error {
 	return p.raft.Handle(pb.Message{
@@ -134,16 +170,39 @@ func (p *Peer) ProposeConfigChange(cc pb.ConfigChange, key uint64) error {
 
 // ApplyConfigChange applies a raft membership change to the local raft node.
 func (p *Peer) ApplyConfigChange(cc pb.ConfigChange) error {
+	p.raft.setShardVersion(cc.ProtocolVersion)
+	if cc.Type == pb.EnterJoint || cc.Type == pb.LeaveJoint {
+		return p.raft.Handle(pb.Message{
+			Type:     pb.ConfigChangeEvent,
+			HintHigh: uint64(cc.Type),
+			Snapshot: pb.Snapshot{
+				Membership: pb.Membership{Addresses: cc.Members},
+			},
+		})
+	}
 	if cc.ReplicaID == NoLeader {
 		p.raft.clearPendingConfigChange()
 		return nil
 	}
-	return p.raft.Handle(pb.Message{
+	if cc.Type == pb.ReplaceWitness {
+		// both the replaced and the new witness are required
+		return p.raft.replaceWitness(cc.ReplacedID, cc.ReplicaID)
+	}
+	m := pb.Message{
 		Type:     pb.ConfigChangeEvent,
 		Reject:   false,
 		Hint:     cc.ReplicaID,
 		HintHigh: uint64(cc.Type),
-	})
+	}
+	if cc.Type == pb.AddNonVoting && cc.Staged {
+		m.Snapshot = pb.Snapshot{
+			Membership: pb.Membership{
+				NonVotings: map[uint64]string{cc.ReplicaID: cc.Address},
+				Staged:     map[uint64]bool{cc.ReplicaID: true},
+			},
+		}
+	}
+	return p.raft.Handle(m)
 }
 
 // RejectConfigChange rejects the currently pending raft membership change.
@@ -249,6 +308,12 @@ func (p *Peer) RateLimited() bool {
 	return p.raft.rl.RateLimited()
 }
 
+// GetInMemLogSize returns the total in memory size of log entries kept in
+// memory by the Raft node. It can be invoked concurrently with other methods.
+func (p *Peer) GetInMemLogSize() uint64 {
+	return p.raft.rl.Get()
+}
+
 // HasUpdate returns a boolean value indicating whether there is any Update
 // ready to be processed.
 func (p *Peer) HasUpdate(moreToApply bool) bool {
@@ -285,9 +350,19 @@ func (p *Peer) HasUpdate(moreToApply bool) bool {
 	if len(r.droppedReadIndexes) > 0 {
 		return true
 	}
+	if len(r.uncommittedEntries) > 0 {
+		return true
+	}
 	return false
 }
 
+// IsTermOrVoteChanged returns a boolean value indicating whether the specified
+// Update changes the term or the vote of the local node.
+func (p *Peer) IsTermOrVoteChanged(ud pb.Update) bool {
+	return !pb.IsEmptyState(ud.State) &&
+		(ud.State.Term != p.prevState.Term || ud.State.Vote != p.prevState.Vote)
+}
+
 // Commit commits the Update state to mark it as processed.
 func (p *Peer) Commit(ud pb.Update) {
 	p.raft.msgs = nil
@@ -295,6 +370,7 @@ func (p *Peer) Commit(ud pb.Update) {
 	p.raft.leaderUpdate = nil
 	p.raft.droppedEntries = nil
 	p.raft.droppedReadIndexes = nil
+	p.raft.uncommittedEntries = nil
 	if !pb.IsEmptyState(ud.State) {
 		p.prevState = ud.State
 	}
@@ -302,6 +378,7 @@ func (p *Peer) Commit(ud pb.Update) {
 		p.raft.clearReadyToRead()
 	}
 	p.entryLog().commitUpdate(ud.UpdateCommit)
+	p.raft.releaseInMemLog()
 }
 
 // ReadIndex starts a ReadIndex operation. The ReadIndex protocol is defined in
@@ -326,6 +403,55 @@ func (p *Peer) HasEntryToApply() bool {
 	return p.entryLog().hasEntriesToApply()
 }
 
+// GetNonVotingProgress returns the replication progress of all non-voting
+// members known to the leader. Nil is returned when the local node is not the
+// leader.
+func (p *Peer) GetNonVotingProgress() map[uint64]server.NonVotingLagInfo {
+	return p.raft.getNonVotingProgress()
+}
+
+// GetElectionStats returns the election and heartbeat timing statistics of the
+// local node.
+func (p *Peer) GetElectionStats() server.ElectionStats {
+	return p.raft.getElectionStats()
+}
+
+// LeaderTransferTargetCaughtUp returns a boolean value indicating whether the
+// specified leader transfer target has all entries in the leader's log. The
+// second returned value is false when the check can not be performed as the
+// local node is not the leader or the target is not a regular member.
+func (p *Peer) LeaderTransferTargetCaughtUp(target uint64) (bool, bool) {
+	return p.raft.leaderTransferTargetCaughtUp(target)
+}
+
+// GetHandoffTarget returns the healthy and caught up regular node the leader
+// can hand off its leadership to, NoNode is returned when there is no such
+// node or when the local node is not the leader.
+func (p *Peer) GetHandoffTarget() uint64 {
+	return p.raft.getHandoffTarget()
+}
+
+// GetInMemLogRetention returns the size of log entries kept in memory grouped
+// by the reason they are retained.
+func (p *Peer) GetInMemLogRetention() server.InMemLogRetention {
+	return p.raft.getInMemRetention()
+}
+
+// GetCommitted returns the committed index known to the local node.
+func (p *Peer) GetCommitted() uint64 {
+	return p.entryLog().committed
+}
+
+// GetLastIndex returns the last index of the local raft log.
+func (p *Peer) GetLastIndex() uint64 {
+	return p.entryLog().lastIndex()
+}
+
+// GetStatus returns a point-in-time view of the raft state of the local node.
+func (p *Peer) GetStatus() server.RaftStatus {
+	return p.raft.getStatus()
+}
+
 func (p *Peer) entryLog() *entryLog {
 	return p.raft.log
 }
@@ -375,6 +501,9 @@ func (p *Peer) getUpdate(moreToApply bool,
 	if len(p.raft.droppedReadIndexes) > 0 {
 		ud.DroppedReadIndexes = p.raft.droppedReadIndexes
 	}
+	if len(p.raft.uncommittedEntries) > 0 {
+		ud.UncommittedEntries = p.raft.uncommittedEntries
+	}
 	return ud, nil
 }
 
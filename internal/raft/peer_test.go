@@ -174,6 +174,14 @@ func testRaftAPIProposeAndConfigChange(cct pb.ConfigChangeType, nid uint64, t *t
 				t.Fatal(err)
 			}
 			ne(rawNode.ProposeConfigChange(cc, 128), t)
+			// the leader stamps its protocol version supported by all members, it
+			// also specifies the removed replica limit when removing
+			cc.ProtocolVersion = pb.ProtocolVersion
+			ccdata = pb.MustMarshal(&cc)
+			if cct == pb.RemoveNode {
+				cc.MaxRemoved = defaultMaxRemovedReplicas
+				ccdata = pb.MustMarshal(&cc)
+			}
 
 			proposed = true
 		}
@@ -331,7 +339,8 @@ func TestRaftAPIProposeAddDuplicateNode(t *testing.T) {
 	}
 
 	cc1 := pb.ConfigChange{Type: pb.AddNode, ReplicaID: 1}
-	ccdata1, err := cc1.Marshal()
+	ccdata1, err := (&pb.ConfigChange{Type: pb.AddNode, ReplicaID: 1,
+		ProtocolVersion: pb.ProtocolVersion}).Marshal()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -342,7 +351,8 @@ func TestRaftAPIProposeAddDuplicateNode(t *testing.T) {
 
 	// the new node join should be ok
 	cc2 := pb.ConfigChange{Type: pb.AddNode, ReplicaID: 2}
-	ccdata2, err := cc2.Marshal()
+	ccdata2, err := (&pb.ConfigChange{Type: pb.AddNode, ReplicaID: 2,
+		ProtocolVersion: pb.ProtocolVersion}).Marshal()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -372,6 +382,55 @@ func TestRaftAPIProposeAddDuplicateNode(t *testing.T) {
 	ne(rawNode.ApplyConfigChange(cc5), t)
 }
 
+func TestRaftAPIApplyReplaceWitness(t *testing.T) {
+	s := NewTestLogDB()
+	rawNode := Launch(newTestConfig(1, 10, 1), s, nil, []PeerAddress{{ReplicaID: 1}}, true, true)
+	ne(rawNode.ApplyConfigChange(pb.ConfigChange{Type: pb.AddWitness, ReplicaID: 2}), t)
+	cc := pb.ConfigChange{Type: pb.ReplaceWitness, ReplicaID: 3, ReplacedID: 2}
+	ne(rawNode.ApplyConfigChange(cc), t)
+	if _, ok := rawNode.raft.witnesses[2]; ok {
+		t.Errorf("replaced witness not removed")
+	}
+	if _, ok := rawNode.raft.witnesses[3]; !ok {
+		t.Errorf("new witness not added")
+	}
+	if _, ok := rawNode.raft.remotes[2]; ok {
+		t.Errorf("replaced witness became a remote")
+	}
+}
+
+func TestRaftAPIIsTermOrVoteChanged(t *testing.T) {
+	s := NewTestLogDB()
+	rawNode := Launch(newTestConfig(1, 10, 1), s, nil, []PeerAddress{{ReplicaID: 1}}, true, true)
+	rawNode.prevState = pb.State{Term: 2, Vote: 1, Commit: 10}
+	tests := []struct {
+		state   pb.State
+		changed bool
+	}{
+		{pb.State{}, false},
+		{pb.State{Term: 2, Vote: 1, Commit: 11}, false},
+		{pb.State{Term: 3, Vote: 1, Commit: 10}, true},
+		{pb.State{Term: 2, Vote: 2, Commit: 10}, true},
+	}
+	for idx, tt := range tests {
+		if v := rawNode.IsTermOrVoteChanged(pb.Update{State: tt.state}); v != tt.changed {
+			t.Errorf("%d, changed %t, want %t", idx, v, tt.changed)
+		}
+	}
+}
+
+func TestRaftAPISetLogLost(t *testing.T) {
+	s := NewTestLogDB()
+	p := Launch(newTestConfig(1, 10, 1), s, nil, []PeerAddress{{ReplicaID: 1}}, false, true)
+	p.SetLogLost()
+	if !p.raft.logLost {
+		t.Fatalf("log lost flag not set")
+	}
+	if p.raft.canGrantVote(pb.Message{From: 2, Term: p.raft.term + 1}) {
+		t.Errorf("replica with lost log granted vote")
+	}
+}
+
 func TestRaftAPIRejectConfigChange(t *testing.T) {
 	s := NewTestLogDB()
 	p := Launch(newTestConfig(1, 10, 1), s, nil, []PeerAddress{{ReplicaID: 1}}, true, true)
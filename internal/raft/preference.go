@@ -0,0 +1,144 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"github.com/lni/dragonboat/v4/config"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// when leader preference is configured, the leader checks on each tick whether
+// there is a healthy and caught up regular node with a higher priority. the
+// leadership is transferred to the one with the highest priority once such
+// node has been available for the configured number of ticks. the leader
+// transfers the leadership automatically at most once in the configured
+// minimum interval.
+
+const (
+	defaultLeaderPreferenceMinIntervalFactor uint64 = 10
+)
+
+type leaderPreference struct {
+	priorities  map[uint64]uint64
+	wait        uint64
+	minInterval uint64
+	elapsed     uint64
+	// lastTransfer is the tick of the last automatic leadership transfer, it
+	// is 0 when no such transfer has been initiated
+	lastTransfer uint64
+}
+
+func newLeaderPreference(c config.Config) leaderPreference {
+	lp := leaderPreference{
+		priorities:  make(map[uint64]uint64, len(c.LeaderPreference)),
+		wait:        c.LeaderPreferenceWaitRTT,
+		minInterval: c.LeaderPreferenceMinIntervalRTT,
+	}
+	for id, p := range c.LeaderPreference {
+		lp.priorities[id] = p
+	}
+	if lp.wait == 0 {
+		lp.wait = c.ElectionRTT
+	}
+	if lp.minInterval == 0 {
+		lp.minInterval = c.ElectionRTT * defaultLeaderPreferenceMinIntervalFactor
+	}
+	return lp
+}
+
+func (lp *leaderPreference) enabled() bool {
+	return len(lp.priorities) > 0
+}
+
+func (lp *leaderPreference) transferAllowed(tick uint64) bool {
+	return lp.lastTransfer == 0 || tick-lp.lastTransfer >= lp.minInterval
+}
+
+// getPreferredLeader returns the healthy and caught up regular node with the
+// highest priority that is higher than the priority of the leader. NoNode is
+// returned when there is no such node.
+func (r *raft) getPreferredLeader() uint64 {
+	target := NoNode
+	priority := r.preference.priorities[r.replicaID]
+	for id, rp := range r.remotes {
+		p := r.preference.priorities[id]
+		if id == r.replicaID || p <= priority {
+			continue
+		}
+		if !r.isRecentlyActive(id) || rp.match < r.log.committed {
+			continue
+		}
+		if target == NoNode || p > r.preference.priorities[target] ||
+			(p == r.preference.priorities[target] && id < target) {
+			target = id
+		}
+	}
+	return target
+}
+
+// getHandoffTarget returns the healthy and caught up regular node with the
+// highest match index, ties are broken by picking the smallest ReplicaID.
+// NoNode is returned when there is no such node or when the leadership can
+// not be transferred at the moment.
+func (r *raft) getHandoffTarget() uint64 {
+	if !r.isLeader() || r.leaderTransfering() || r.isJoint() {
+		return NoNode
+	}
+	target := NoNode
+	for id, rp := range r.remotes {
+		if id == r.replicaID {
+			continue
+		}
+		if !r.isRecentlyActive(id) || rp.match < r.log.committed {
+			continue
+		}
+		if target == NoNode || rp.match > r.remotes[target].match ||
+			(rp.match == r.remotes[target].match && id < target) {
+			target = id
+		}
+	}
+	return target
+}
+
+// checkLeaderPreference is called by the leader on each tick to transfer the
+// leadership to the preferred node.
+func (r *raft) checkLeaderPreference() error {
+	if !r.preference.enabled() || !r.isLeader() {
+		return nil
+	}
+	if r.leaderTransfering() || r.isJoint() {
+		r.preference.elapsed = 0
+		return nil
+	}
+	target := r.getPreferredLeader()
+	if target == NoNode {
+		r.preference.elapsed = 0
+		return nil
+	}
+	r.preference.elapsed++
+	if r.preference.elapsed <= r.preference.wait ||
+		!r.preference.transferAllowed(r.tickCount) {
+		return nil
+	}
+	plog.Infof("%s transferring leadership to the preferred %s",
+		r.describe(), ReplicaID(target))
+	r.preference.elapsed = 0
+	r.preference.lastTransfer = r.tickCount
+	return r.handleLeaderTransfer(pb.Message{
+		Type: pb.LeaderTransfer,
+		From: r.replicaID,
+		Hint: target,
+	})
+}
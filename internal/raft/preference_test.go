@@ -0,0 +1,127 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"testing"
+
+	"github.com/lni/dragonboat/v4/config"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func newTestPreferenceLeader(t *testing.T,
+	priorities map[uint64]uint64) *raft {
+	c := newTestConfig(1, 10, 1)
+	c.LeaderPreference = priorities
+	c.LeaderPreferenceWaitRTT = 3
+	c.LeaderPreferenceMinIntervalRTT = 50
+	logdb := NewTestLogDB()
+	ne(logdb.Append([]pb.Entry{{Index: 1, Term: 1}}), t)
+	r := newRaft(c, logdb)
+	for _, id := range []uint64{1, 2, 3} {
+		r.remotes[id] = &remote{next: 1}
+	}
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	return r
+}
+
+func tickPreferenceLeader(t *testing.T, r *raft, count int, responders ...uint64) {
+	for i := 0; i < count; i++ {
+		ne(r.tick(), t)
+		for _, id := range responders {
+			r.remotes[id].match = r.log.lastIndex()
+			ne(r.Handle(pb.Message{From: id, To: 1, Type: pb.HeartbeatResp,
+				Term: r.term}), t)
+		}
+	}
+}
+
+func TestLeaderTransfersToPreferredNode(t *testing.T) {
+	r := newTestPreferenceLeader(t, map[uint64]uint64{1: 1, 2: 3, 3: 2})
+	// peers become active after their first responses
+	tickPreferenceLeader(t, r, 4, 2, 3)
+	if r.leaderTransfering() {
+		t.Fatalf("leadership transferred before the wait")
+	}
+	tickPreferenceLeader(t, r, 1, 2, 3)
+	if !r.leaderTransfering() || r.leaderTransferTarget != 2 {
+		t.Fatalf("leadership not transferred to the preferred node, %d",
+			r.leaderTransferTarget)
+	}
+	r.msgs = nil
+	r.abortLeaderTransfer()
+	tickPreferenceLeader(t, r, 10, 2, 3)
+	if r.leaderTransfering() {
+		t.Errorf("leadership transferred within the min interval")
+	}
+}
+
+func TestLeaderPreferenceIgnoresInactiveNode(t *testing.T) {
+	r := newTestPreferenceLeader(t, map[uint64]uint64{1: 1, 2: 3, 3: 2})
+	tickPreferenceLeader(t, r, 5, 3)
+	if !r.leaderTransfering() || r.leaderTransferTarget != 3 {
+		t.Fatalf("leadership not transferred to the active node, %d",
+			r.leaderTransferTarget)
+	}
+}
+
+func TestLeaderPreferenceIgnoresLowerPriority(t *testing.T) {
+	r := newTestPreferenceLeader(t, map[uint64]uint64{1: 2, 2: 2, 3: 1})
+	tickPreferenceLeader(t, r, 10, 2, 3)
+	if r.leaderTransfering() {
+		t.Errorf("leadership unexpectedly transferred")
+	}
+}
+
+func TestLeaderPreferenceDefaults(t *testing.T) {
+	c := config.Config{ElectionRTT: 10}
+	lp := newLeaderPreference(c)
+	if lp.enabled() || lp.wait != 10 || lp.minInterval != 100 {
+		t.Errorf("unexpected leader preference %+v", lp)
+	}
+	if !lp.transferAllowed(1) {
+		t.Errorf("first transfer not allowed")
+	}
+	lp.lastTransfer = 10
+	if lp.transferAllowed(109) || !lp.transferAllowed(110) {
+		t.Errorf("unexpected min interval")
+	}
+}
+
+func TestHandoffTargetIsHealthyAndCaughtUp(t *testing.T) {
+	r := newTestPreferenceLeader(t, nil)
+	if target := r.getHandoffTarget(); target != NoNode {
+		t.Fatalf("inactive node %d selected", target)
+	}
+	tickPreferenceLeader(t, r, 1, 2, 3)
+	r.remotes[3].match = r.log.lastIndex() + 1
+	if target := r.getHandoffTarget(); target != 3 {
+		t.Errorf("target %d, want 3", target)
+	}
+	r.remotes[3].match = r.log.lastIndex()
+	if target := r.getHandoffTarget(); target != 2 {
+		t.Errorf("target %d, want 2", target)
+	}
+	r.log.committed = r.log.lastIndex()
+	r.remotes[2].match = r.log.committed - 1
+	if target := r.getHandoffTarget(); target != 3 {
+		t.Errorf("target %d, want 3", target)
+	}
+	r.leaderTransferTarget = 3
+	if target := r.getHandoffTarget(); target != NoNode {
+		t.Errorf("target %d selected during leader transfer", target)
+	}
+}
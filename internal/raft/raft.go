@@ -31,6 +31,7 @@ import (
 	"github.com/lni/goutils/random"
 
 	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/failpoint"
 	"github.com/lni/dragonboat/v4/internal/server"
 	"github.com/lni/dragonboat/v4/internal/settings"
 	"github.com/lni/dragonboat/v4/logger"
@@ -38,7 +39,7 @@ import (
 )
 
 var (
-	plog = logger.GetLogger("raft")
+	plog = logger.GetStructuredLogger("raft")
 )
 
 const (
@@ -48,7 +49,7 @@ const (
 	// NoNode is the flag used to indicate that the node id field is not set.
 	NoNode          uint64 = 0
 	noLimit         uint64 = math.MaxUint64
-	numMessageTypes uint64 = 29
+	numMessageTypes uint64 = 33
 )
 
 var (
@@ -207,6 +208,22 @@ type raft struct {
 	remotes                   map[uint64]*remote
 	nonVotings                map[uint64]*remote
 	witnesses                 map[uint64]*remote
+	joint                     jointConfig
+	staged                    map[uint64]*stagedNonVoting
+	stagedMaxLag              uint64
+	stagedMaxLagBytes         uint64
+	stagedTimeout             uint64
+	maxWitnesses              uint64
+	maxRemoved                uint64
+	shardVersion              uint32
+	maxNonVotings             uint64
+	nonVotingLags             map[uint64]*nonVotingLag
+	lagAlertEntries           uint64
+	lagAlertTimeout           uint64
+	maxEntriesOverSnapshot    uint64
+	catchupBytesPerTick       uint64
+	catchupLagEntries         uint64
+	preference                leaderPreference
 	logQueryResult            *pb.LogQueryResult
 	leaderUpdate              *pb.LeaderUpdate
 	readIndex                 *readIndex
@@ -214,8 +231,10 @@ type raft struct {
 	msgs                      []pb.Message
 	droppedReadIndexes        []pb.SystemCtx
 	droppedEntries            []pb.Entry
+	uncommittedEntries        []pb.Entry
 	readyToRead               []pb.ReadyToRead
 	prevLeader                server.LeaderInfo
+	electionStats             electionStats
 	state                     State
 	leaderTransferTarget      uint64
 	leaderID                  uint64
@@ -230,12 +249,26 @@ type raft struct {
 	heartbeatTimeout          uint64
 	electionTimeout           uint64
 	randomizedElectionTimeout uint64
+	suppressedTerm            uint64
+	random                    func() uint64
 	snapshotting              bool
 	checkQuorum               bool
 	quiesce                   bool
 	isLeaderTransferTarget    bool
 	pendingConfigChange       bool
 	preVote                   bool
+	lazyReplay                bool
+	campaignDisabled          bool
+	campaignSuppressed        bool
+	// logLost is set when the Volatile replica or the promoted witness has no
+	// Raft log and has not caught up with the leader's commit index yet
+	logLost bool
+}
+
+// isVolatile returns a boolean value indicating whether the Raft log of the
+// replica is kept in memory.
+func isVolatile(c config.Config) bool {
+	return c.StorageClass == config.Volatile
 }
 
 func newRaft(c config.Config, logdb ILogDB) *raft {
@@ -247,22 +280,50 @@ func newRaft(c config.Config, logdb ILogDB) *raft {
 	}
 	rl := server.NewInMemRateLimiter(c.MaxInMemLogSize)
 	r := &raft{
-		shardID:          c.ShardID,
-		replicaID:        c.ReplicaID,
-		leaderID:         NoLeader,
-		msgs:             make([]pb.Message, 0),
-		droppedEntries:   make([]pb.Entry, 0),
-		log:              newEntryLog(logdb, rl),
-		remotes:          make(map[uint64]*remote),
-		nonVotings:       make(map[uint64]*remote),
-		witnesses:        make(map[uint64]*remote),
-		electionTimeout:  c.ElectionRTT,
-		heartbeatTimeout: c.HeartbeatRTT,
-		checkQuorum:      c.CheckQuorum,
-		preVote:          c.PreVote,
-		readIndex:        newReadIndex(),
-		rl:               rl,
-	}
+		shardID:                c.ShardID,
+		replicaID:              c.ReplicaID,
+		leaderID:               NoLeader,
+		msgs:                   make([]pb.Message, 0),
+		droppedEntries:         make([]pb.Entry, 0),
+		log:                    newEntryLog(logdb, rl),
+		remotes:                make(map[uint64]*remote),
+		nonVotings:             make(map[uint64]*remote),
+		witnesses:              make(map[uint64]*remote),
+		electionTimeout:        c.ElectionRTT,
+		heartbeatTimeout:       c.HeartbeatRTT,
+		checkQuorum:            c.CheckQuorum,
+		preVote:                c.PreVote,
+		lazyReplay:             c.LazyReplay,
+		readIndex:              newReadIndex(),
+		rl:                     rl,
+		staged:                 make(map[uint64]*stagedNonVoting),
+		stagedMaxLag:           c.StagedPromotionMaxLag,
+		stagedMaxLagBytes:      c.StagedPromotionMaxLagBytes,
+		stagedTimeout:          c.StagedPromotionTimeoutRTT,
+		maxWitnesses:           c.MaxWitnesses,
+		maxRemoved:             c.MaxRemovedReplicas,
+		maxNonVotings:          c.MaxNonVotings,
+		nonVotingLags:          make(map[uint64]*nonVotingLag),
+		lagAlertEntries:        c.NonVotingLagAlertEntries,
+		lagAlertTimeout:        c.NonVotingLagAlertRTT,
+		maxEntriesOverSnapshot: c.MaxEntriesOverSnapshot,
+		catchupLagEntries:      c.CatchupThrottleLagEntries,
+		electionStats:          newElectionStats(),
+		random:                 random.LockGuardedRand.Uint64,
+	}
+	if r.stagedMaxLag == 0 {
+		r.stagedMaxLag = defaultStagedPromotionMaxLag
+	}
+	if r.maxWitnesses == 0 {
+		r.maxWitnesses = defaultMaxWitnesses
+	}
+	if r.maxRemoved == 0 {
+		r.maxRemoved = defaultMaxRemovedReplicas
+	}
+	if r.catchupLagEntries == 0 {
+		r.catchupLagEntries = defaultCatchupLagEntries
+	}
+	r.preference = newLeaderPreference(c)
 	plog.Infof("%s raft log rate limit enabled: %t, %d",
 		dn(r.shardID, r.replicaID), r.rl.Enabled(), c.MaxInMemLogSize)
 	st, members := logdb.NodeState()
@@ -275,6 +336,14 @@ func newRaft(c config.Config, logdb ILogDB) *raft {
 	for p := range members.Witnesses {
 		r.witnesses[p] = &remote{next: 1}
 	}
+	for p := range members.Outgoing {
+		if _, ok := r.remotes[p]; !ok {
+			r.remotes[p] = &remote{next: 1}
+		}
+	}
+	r.restoreJoint(members)
+	r.restoreStaged(members)
+	r.setShardVersion(members.ProtocolVersion)
 	r.resetMatchValueArray()
 	if !pb.IsEmptyState(st) {
 		r.loadState(st)
@@ -316,6 +385,20 @@ func (r *raft) resetMatchValueArray() {
 	r.matched = make([]uint64, r.numVotingMembers())
 }
 
+// logFields returns the fields attached to structured log records.
+func (r *raft) logFields() []logger.Field {
+	return []logger.Field{
+		logger.ShardID(r.shardID),
+		logger.ReplicaID(r.replicaID),
+		logger.Term(r.term),
+		logger.Uint64("leaderid", r.leaderID),
+		logger.Uint64("first", r.log.firstIndex()),
+		logger.Uint64("last", r.log.lastIndex()),
+		logger.Uint64("committed", r.log.committed),
+		logger.Uint64("applied", r.log.processed),
+	}
+}
+
 func (r *raft) describe() string {
 	li := r.log.lastIndex()
 	t, err := r.log.term(li)
@@ -353,6 +436,7 @@ func (r *raft) mustBeLeader() {
 
 func (r *raft) setLeaderID(leaderID uint64) {
 	r.leaderID = leaderID
+	r.electionStats.leaderUpdated(leaderID)
 	r.leaderUpdate = &pb.LeaderUpdate{
 		LeaderID: leaderID,
 		Term:     r.term,
@@ -389,18 +473,35 @@ func (r *raft) quorum() int {
 }
 
 func (r *raft) isSingleNodeQuorum() bool {
+	if r.isJoint() {
+		return r.jointHasQuorum(func(id uint64) bool {
+			return id == r.replicaID
+		})
+	}
 	return r.quorum() == 1
 }
 
 func (r *raft) leaderHasQuorum() bool {
 	c := 0
-
+	var active map[uint64]struct{}
+	if r.isJoint() {
+		active = make(map[uint64]struct{})
+	}
 	for nid, member := range r.votingMembers() {
 		if nid == r.replicaID || member.isActive() {
 			c++
 			member.setNotActive()
+			if active != nil {
+				active[nid] = struct{}{}
+			}
 		}
 	}
+	if active != nil {
+		return r.jointHasQuorum(func(id uint64) bool {
+			_, ok := active[id]
+			return ok
+		})
+	}
 	return c >= r.quorum()
 }
 
@@ -508,6 +609,22 @@ func (r *raft) restoreRemotes(ss pb.Snapshot) {
 		plog.Debugf("%s restored remote progress of %s [%s]",
 			r.describe(), ReplicaID(id), r.remotes[id])
 	}
+	for id := range ss.Membership.Outgoing {
+		if _, ok := r.remotes[id]; ok {
+			continue
+		}
+		match := uint64(0)
+		next := r.log.lastIndex() + 1
+		if id == r.replicaID {
+			match = next - 1
+		}
+		r.setRemote(id, match, next)
+		plog.Debugf("%s restored outgoing remote progress of %s [%s]",
+			r.describe(), ReplicaID(id), r.remotes[id])
+	}
+	r.restoreJoint(ss.Membership)
+	r.restoreStaged(ss.Membership)
+	r.setShardVersion(ss.Membership.ProtocolVersion)
 	if r.selfRemoved() && r.isLeader() {
 		r.becomeFollower(r.term, NoLeader)
 	}
@@ -644,6 +761,14 @@ func (r *raft) leaderTick() error {
 			return err
 		}
 	}
+	if err := r.checkStaged(); err != nil {
+		return err
+	}
+	r.checkNonVotingLag()
+	r.refillCatchupTokens()
+	if err := r.checkLeaderPreference(); err != nil {
+		return err
+	}
 	return r.checkPendingSnapshotAck()
 }
 
@@ -656,7 +781,7 @@ func (r *raft) quiescedTick() {
 }
 
 func (r *raft) setRandomizedElectionTimeout() {
-	randTime := random.LockGuardedRand.Uint64() % r.electionTimeout
+	randTime := r.random() % r.electionTimeout
 	r.randomizedElectionTimeout = r.electionTimeout + randTime
 }
 
@@ -686,6 +811,41 @@ func (r *raft) send(m pb.Message) {
 	r.msgs = append(r.msgs, m)
 }
 
+// releaseInMemLog releases applied and saved entries from the in memory log
+// when it is approaching the MaxInMemLogSize limit.
+func (r *raft) releaseInMemLog() {
+	if r.rl.ReleaseRequired() {
+		r.log.inmem.tryRelease(r.getApplied(), r.followerNeededIndex())
+	}
+}
+
+// getInMemRetention returns the size of entries kept in memory grouped by the
+// reason they can not be released.
+func (r *raft) getInMemRetention() server.InMemLogRetention {
+	return r.log.inmem.getRetention(r.getApplied(), r.followerNeededIndex())
+}
+
+// followerNeededIndex returns the first log index not yet acknowledged by all
+// followers. Entries from the returned index might be required for replicating
+// them to followers, there is no such entry when the local node is not the
+// leader.
+func (r *raft) followerNeededIndex() uint64 {
+	index := r.log.lastIndex() + 1
+	if !r.isLeader() {
+		return index
+	}
+	for _, remotes := range []map[uint64]*remote{
+		r.remotes, r.nonVotings, r.witnesses,
+	} {
+		for id, rp := range remotes {
+			if id != r.replicaID {
+				index = min(index, rp.match+1)
+			}
+		}
+	}
+	return index
+}
+
 func (r *raft) sendRateLimitMessage() {
 	if r.isLeader() {
 		plog.Panicf("leader node called sendRateLimitMessage")
@@ -725,14 +885,16 @@ func (r *raft) makeInstallSnapshotMessage(to uint64, m *pb.Message) uint64 {
 	return snapshot.Index
 }
 
+// makeWitnessSnapshot returns the metadata only snapshot to be sent to a
+// witness, witnesses have no state machine to be recovered.
 func makeWitnessSnapshot(snapshot pb.Snapshot) pb.Snapshot {
-	result := snapshot
-	result.Filepath = ""
-	result.FileSize = 0
-	result.Files = nil
-	result.Witness = true
-	result.Dummy = false
-	return result
+	return pb.Snapshot{
+		ShardID:    snapshot.ShardID,
+		Index:      snapshot.Index,
+		Term:       snapshot.Term,
+		Membership: snapshot.Membership,
+		Witness:    true,
+	}
 }
 
 func (r *raft) makeReplicateMessage(to uint64,
@@ -768,6 +930,40 @@ func (r *raft) makeReplicateMessage(to uint64,
 	}, nil
 }
 
+// makeRetainedReplicateMessage makes a Replicate message using entries that
+// have been compacted from the log but are still retained in the LogDB. It
+// allows a follower lagging behind the first index of the log by no more than
+// maxEntriesOverSnapshot entries to catch up without receiving a snapshot.
+func (r *raft) makeRetainedReplicateMessage(to uint64,
+	next uint64, maxSize uint64) (pb.Message, error) {
+	first := r.log.firstIndex()
+	if r.maxEntriesOverSnapshot == 0 || next <= 1 || next >= first ||
+		first-next > r.maxEntriesOverSnapshot {
+		return pb.Message{}, ErrCompacted
+	}
+	// the entry at next-1 is requested as well to get its term
+	ents, err := r.log.logdb.RetainedEntries(next-1, first, maxSize)
+	if err != nil {
+		return pb.Message{}, err
+	}
+	if len(ents) < 2 || ents[0].Index != next-1 {
+		return pb.Message{}, ErrCompacted
+	}
+	term := ents[0].Term
+	entries := ents[1:]
+	if _, ok := r.witnesses[to]; ok {
+		entries = makeMetadataEntries(entries)
+	}
+	return pb.Message{
+		To:       to,
+		Type:     pb.Replicate,
+		LogIndex: next - 1,
+		LogTerm:  term,
+		Entries:  entries,
+		Commit:   r.log.committed,
+	}, nil
+}
+
 func makeMetadataEntries(entries []pb.Entry) []pb.Entry {
 	me := make([]pb.Entry, 0, len(entries))
 	for _, ent := range entries {
@@ -799,7 +995,14 @@ func (r *raft) sendReplicateMessage(to uint64) {
 	if rp.isPaused() {
 		return
 	}
-	m, err := r.makeReplicateMessage(to, rp.next, maxEntrySize)
+	maxSize, ok := r.acquireCatchupTokens(rp)
+	if !ok {
+		return
+	}
+	m, err := r.makeReplicateMessage(to, rp.next, maxSize)
+	if err == ErrCompacted {
+		m, err = r.makeRetainedReplicateMessage(to, rp.next, maxSize)
+	}
 	if err != nil {
 		// log not available due to compaction, send snapshot
 		if !rp.isActive() {
@@ -814,6 +1017,7 @@ func (r *raft) sendReplicateMessage(to uint64) {
 	} else if len(m.Entries) > 0 {
 		lastIndex := m.Entries[len(m.Entries)-1].Index
 		rp.progress(lastIndex)
+		r.releaseCatchupTokens(rp, getEntrySliceSize(m.Entries))
 	}
 	r.send(m)
 }
@@ -832,15 +1036,20 @@ func (r *raft) broadcastReplicateMessage() {
 	}
 }
 
+// sendHeartbeatMessage sends a heartbeat message with the commit index capped
+// by the replication progress of the remote. The uncapped commit index of the
+// leader is carried in the LeaderCommit field, it allows the remote to tell
+// how far its applied state lags behind the leader.
 func (r *raft) sendHeartbeatMessage(to uint64,
 	hint pb.SystemCtx, match uint64) {
 	commit := min(match, r.log.committed)
 	r.send(pb.Message{
-		To:       to,
-		Type:     pb.Heartbeat,
-		Commit:   commit,
-		Hint:     hint.Low,
-		HintHigh: hint.High,
+		To:           to,
+		Type:         pb.Heartbeat,
+		Commit:       commit,
+		LeaderCommit: r.log.committed,
+		Hint:         hint.Low,
+		HintHigh:     hint.High,
 	})
 }
 
@@ -861,11 +1070,15 @@ func (r *raft) broadcastHeartbeatMessageWithHint(ctx pb.SystemCtx) {
 	for id, rm := range r.votingMembers() {
 		if id != r.replicaID {
 			r.sendHeartbeatMessage(id, ctx, rm.match)
+			if ctx == zeroCtx {
+				r.electionStats.heartbeatSent(id)
+			}
 		}
 	}
 	if ctx == zeroCtx {
 		for id, rm := range r.nonVotings {
 			r.sendHeartbeatMessage(id, zeroCtx, rm.match)
+			r.electionStats.heartbeatSent(id)
 		}
 	}
 }
@@ -910,6 +1123,9 @@ func (r *raft) sortMatchValues() {
 
 func (r *raft) tryCommit() (bool, error) {
 	r.mustBeLeader()
+	if r.isJoint() {
+		return r.log.tryCommit(r.jointCommitIndex(), r.term)
+	}
 	if r.numVotingMembers() != len(r.matched) {
 		r.resetMatchValueArray()
 	}
@@ -956,10 +1172,13 @@ func (r *raft) toFollowerState(term uint64, leaderID uint64,
 	if r.isWitness() {
 		panic("transitioning to follower from witness state")
 	}
+	if r.state == candidate {
+		r.electionStats.lost++
+	}
 	r.state = follower
 	r.reset(term, resetElectionTimeout)
 	r.setLeaderID(leaderID)
-	plog.Infof("%s became follower", r.describe())
+	plog.Infow("became follower", r.logFields()...)
 }
 
 func (r *raft) becomeNonVoting(term uint64, leaderID uint64) {
@@ -971,7 +1190,7 @@ func (r *raft) becomeNonVoting(term uint64, leaderID uint64) {
 	}
 	r.reset(term, true)
 	r.setLeaderID(leaderID)
-	plog.Infof("%s became nonVoting", r.describe())
+	plog.Infow("became nonVoting", r.logFields()...)
 }
 
 func (r *raft) becomeWitness(term uint64, leaderID uint64) {
@@ -980,7 +1199,7 @@ func (r *raft) becomeWitness(term uint64, leaderID uint64) {
 	}
 	r.reset(term, true)
 	r.setLeaderID(leaderID)
-	plog.Infof("%s became witness", r.describe())
+	plog.Infow("became witness", r.logFields()...)
 }
 
 func (r *raft) becomeFollower(term uint64, leaderID uint64) {
@@ -1007,7 +1226,7 @@ func (r *raft) becomePreVoteCandidate() {
 	r.state = preVoteCandidate
 	r.reset(r.term, true)
 	r.setLeaderID(NoLeader)
-	plog.Warningf("%s became PreVote candidate", r.describe())
+	plog.Warningw("became PreVote candidate", r.logFields()...)
 }
 
 func (r *raft) becomeCandidate() {
@@ -1025,7 +1244,8 @@ func (r *raft) becomeCandidate() {
 	r.reset(r.term+1, true)
 	r.setLeaderID(NoLeader)
 	r.vote = r.replicaID
-	plog.Warningf("%s became candidate", r.describe())
+	r.electionStats.started++
+	plog.Warningw("became candidate", r.logFields()...)
 }
 
 func (r *raft) becomeLeader() error {
@@ -1033,13 +1253,24 @@ func (r *raft) becomeLeader() error {
 	if !r.isLeader() && !r.isCandidate() {
 		plog.Panicf("transitioning to leader state from %v", r.state.String())
 	}
+	if r.state == candidate {
+		r.electionStats.won++
+	}
 	r.state = leader
 	r.reset(r.term, true)
 	r.setLeaderID(r.replicaID)
+	r.electionStats.becameLeader()
 	r.preLeaderPromotionHandleConfigChange()
-	plog.Infof("%s became leader", r.describe())
+	plog.Infow("became leader", r.logFields()...)
 	// p72 of the raft thesis
-	return r.appendEntries([]pb.Entry{{Type: pb.ApplicationEntry, Cmd: nil}})
+	if err := r.appendEntries([]pb.Entry{{Type: pb.ApplicationEntry, Cmd: nil}}); err != nil {
+		return err
+	}
+	// the previous leader failed before leaving the joint config
+	if r.isJoint() && !r.hasPendingConfigChange() {
+		return r.proposeLeaveJoint()
+	}
+	return nil
 }
 
 func (r *raft) reset(term uint64, resetElectionTimeout bool) {
@@ -1063,6 +1294,9 @@ func (r *raft) reset(term uint64, resetElectionTimeout bool) {
 	r.resetNonVotings()
 	r.resetWitnesses()
 	r.resetMatchValueArray()
+	r.resetStaged()
+	r.resetNonVotingLags()
+	r.preference.elapsed = 0
 }
 
 func (r *raft) preLeaderPromotionHandleConfigChange() {
@@ -1123,6 +1357,9 @@ func (r *raft) handleVoteResp(from uint64, rejected bool, preVote bool) int {
 	if rejected {
 		plog.Warningf("%s received %s rejection from %s",
 			r.describe(), mname, ReplicaID(from))
+		if preVote {
+			r.electionStats.preVoteRejections++
+		}
 	} else {
 		plog.Warningf("%s received %s from %s",
 			r.describe(), mname, ReplicaID(from))
@@ -1139,6 +1376,15 @@ func (r *raft) handleVoteResp(from uint64, rejected bool, preVote bool) int {
 	return votedFor
 }
 
+// voteResult returns whether the election has been won or lost given the
+// number of granted votes.
+func (r *raft) voteResult(count int) (bool, bool) {
+	if r.isJoint() {
+		return r.jointVoteResult()
+	}
+	return count == r.quorum(), len(r.votes)-count == r.quorum()
+}
+
 func (r *raft) preVoteCampaign() error {
 	r.becomePreVoteCandidate()
 	r.handleVoteResp(r.replicaID, false, true)
@@ -1271,6 +1517,30 @@ func (r *raft) addWitness(replicaID uint64) {
 	r.setWitness(replicaID, 0, r.log.lastIndex()+1)
 }
 
+func (r *raft) promoteWitness(replicaID uint64) {
+	r.clearPendingConfigChange()
+	if _, ok := r.witnesses[replicaID]; !ok {
+		return
+	}
+	// the promoted witness has no state machine data and its log only contains
+	// metadata entries, it drops its log when restarted as a regular node. its
+	// progress info is thus not inherited, responses from the witness are
+	// ignored until the restarted node reports its empty log.
+	r.deleteWitness(replicaID)
+	r.setRemote(replicaID, 0, r.log.lastIndex()+1)
+	if replicaID != r.replicaID {
+		r.remotes[replicaID].promoted = true
+	}
+}
+
+// replaceWitness swaps the witness replaced by the new witness in a single
+// step, the replaced witness is expected to be permanently unavailable so the
+// voting quorum size is not changed.
+func (r *raft) replaceWitness(replaced uint64, replicaID uint64) error {
+	r.addWitness(replicaID)
+	return r.removeNode(replaced)
+}
+
 func (r *raft) removeNode(replicaID uint64) error {
 	r.deleteRemote(replicaID)
 	r.deleteNonVoting(replicaID)
@@ -1301,6 +1571,7 @@ func (r *raft) deleteRemote(replicaID uint64) {
 
 func (r *raft) deleteNonVoting(replicaID uint64) {
 	delete(r.nonVotings, replicaID)
+	delete(r.staged, replicaID)
 }
 
 func (r *raft) deleteWitness(replicaID uint64) {
@@ -1395,6 +1666,19 @@ func (r *raft) getPendingConfigChangeCount() int {
 //
 
 func (r *raft) handleHeartbeatMessage(m pb.Message) error {
+	if r.logLost {
+		// the commit index is based on the log lost by the replica, the leader is
+		// asked to replicate entries again by rejecting the heartbeat
+		r.send(pb.Message{
+			To:       m.From,
+			Type:     pb.HeartbeatResp,
+			Reject:   true,
+			LogIndex: r.log.lastIndex(),
+			Hint:     m.Hint,
+			HintHigh: m.HintHigh,
+		})
+		return nil
+	}
 	r.log.commitTo(m.Commit)
 	r.send(pb.Message{
 		To:       m.From,
@@ -1459,6 +1743,11 @@ func (r *raft) handleReplicateMessage(m pb.Message) error {
 		lastIdx := m.LogIndex + uint64(len(m.Entries))
 		r.log.commitTo(min(lastIdx, m.Commit))
 		resp.LogIndex = lastIdx
+		if r.logLost && lastIdx >= m.Commit {
+			plog.Infof("%s recovered its lost log, commit %d",
+				r.describe(), m.Commit)
+			r.logLost = false
+		}
 	} else {
 		plog.Debugf("%s rejected Replicate index %d term %d from %s",
 			r.describe(), m.LogIndex, m.Term, ReplicaID(m.From))
@@ -1476,6 +1765,9 @@ func (r *raft) handleReplicateMessage(m pb.Message) error {
 			r.events.ReplicationRejected(info)
 		}
 	}
+	if err := failpoint.Inject(failpoint.BeforeReplicateResp); err != nil {
+		return err
+	}
 	r.send(resp)
 	return nil
 }
@@ -1568,6 +1860,9 @@ func (r *raft) onMessageTermNotMatched(m pb.Message) bool {
 				} else {
 					plog.Warningf("%s become follower after receiving higher term from %s",
 						r.describe(), ReplicaID(m.From))
+					if m.Type == pb.RequestPreVoteResp && r.state == preVoteCandidate {
+						r.electionStats.preVoteRejections++
+					}
 					r.becomeFollower(m.Term, leaderID)
 				}
 			}
@@ -1586,13 +1881,20 @@ func (r *raft) onMessageTermNotMatched(m pb.Message) bool {
 	return false
 }
 
+// inconsistentRaftConfig returns a boolean value indicating whether the
+// message is only expected when preVote is enabled on the local node. nodes
+// with preVote disabled still respond to RequestPreVote messages as that
+// doesn't change their local state, this allows shards to be reconfigured to
+// use preVote in a rolling manner.
 func (r *raft) inconsistentRaftConfig(m pb.Message) bool {
-	return !r.preVote && isPreVoteMessage(m.Type)
+	return !r.preVote && m.Type == pb.RequestPreVoteResp
 }
 
 func (r *raft) Handle(m pb.Message) error {
 	if r.inconsistentRaftConfig(m) {
-		panic("received preVote message when preVote is not enabled")
+		plog.Warningf("%s dropped %s from %s, preVote not enabled",
+			r.describe(), m.Type, ReplicaID(m.From))
+		return nil
 	}
 	if !r.onMessageTermNotMatched(m) {
 		if !isPreVoteMessage(m.Type) {
@@ -1611,6 +1913,9 @@ func (r *raft) hasConfigChangeToApply() bool {
 	if r.hasNotAppliedConfigChange != nil {
 		return r.hasNotAppliedConfigChange()
 	}
+	if r.lazyReplay {
+		return r.hasCommittedConfigChange()
+	}
 	// TODO:
 	// with the current entry log implementation, the simplification below is no
 	// longer required, we can now actually scan the committed but not applied
@@ -1618,7 +1923,36 @@ func (r *raft) hasConfigChangeToApply() bool {
 	return r.log.committed > r.getApplied()
 }
 
+// hasCommittedConfigChange returns a boolean value indicating whether there
+// is any config change entry committed but not applied. It allows replicas
+// still replaying their logs to campaign, committed entries not in memory are
+// read from the LogDB.
+func (r *raft) hasCommittedConfigChange() bool {
+	low := max(r.getApplied()+1, r.log.firstIndex())
+	high := r.log.committed + 1
+	for low < high {
+		ents, err := r.log.getEntries(low, high, maxEntriesToApplySize)
+		if err != nil || len(ents) == 0 {
+			plog.Warningf("%s failed to get committed entries, %v",
+				r.describe(), err)
+			return true
+		}
+		for _, e := range ents {
+			if e.IsConfigChange() {
+				return true
+			}
+		}
+		low = ents[len(ents)-1].Index + 1
+	}
+	return false
+}
+
 func (r *raft) canGrantVote(m pb.Message) bool {
+	// the lost log might have contained entries committed with the help of the
+	// local replica, it doesn't vote before recovering them from the leader
+	if r.logLost {
+		return false
+	}
 	return r.vote == NoNode || r.vote == m.From || m.Term > r.term
 }
 
@@ -1628,6 +1962,10 @@ func (r *raft) canGrantVote(m pb.Message) bool {
 
 func (r *raft) handleNodeElection(m pb.Message) error {
 	if !r.isLeader() {
+		if r.campaignDisabled {
+			r.suppressCampaign()
+			return nil
+		}
 		// there can be multiple pending membership change entries committed but not
 		// applied on this node. say with a shard of X, Y and Z, there are two
 		// such entries for adding node A and B are committed but not applied
@@ -1664,6 +2002,25 @@ func (r *raft) handleNodeElection(m pb.Message) error {
 	return nil
 }
 
+// suppressCampaign drops the campaign attempt of a node with campaigns
+// disabled, suppressed campaigns are reported once per term.
+func (r *raft) suppressCampaign() {
+	if r.campaignSuppressed && r.suppressedTerm == r.term {
+		return
+	}
+	r.campaignSuppressed = true
+	r.suppressedTerm = r.term
+	plog.Warningf("%s campaign suppressed, campaign disabled", r.describe())
+	if r.events != nil {
+		info := server.CampaignInfo{
+			ShardID:   r.shardID,
+			ReplicaID: r.replicaID,
+			Term:      r.term,
+		}
+		r.events.CampaignSuppressed(info)
+	}
+}
+
 func (r *raft) handleNodeRequestPreVote(m pb.Message) error {
 	resp := pb.Message{
 		To:   m.From,
@@ -1676,7 +2033,7 @@ func (r *raft) handleNodeRequestPreVote(m pb.Message) error {
 	if m.Term < r.term {
 		panic("m.term < r.term")
 	}
-	if m.Term > r.term && isUpToDate {
+	if m.Term > r.term && isUpToDate && !r.logLost {
 		resp.Term = m.Term
 		plog.Warningf("%s cast preVote from %s index %d term %d, log term: %d",
 			r.describe(), ReplicaID(m.From), m.LogIndex, m.Term, m.LogTerm)
@@ -1721,6 +2078,10 @@ func (r *raft) handleNodeRequestVote(m pb.Message) error {
 func (r *raft) handleNodeConfigChange(m pb.Message) error {
 	if m.Reject {
 		r.clearPendingConfigChange()
+		// config changes other than LeaveJoint are rejected in joint config
+		if r.isJoint() && r.isLeader() {
+			return r.proposeLeaveJoint()
+		}
 	} else {
 		cctype := (pb.ConfigChangeType)(m.HintHigh)
 		nodeid := m.Hint
@@ -1733,8 +2094,25 @@ func (r *raft) handleNodeConfigChange(m pb.Message) error {
 			}
 		case pb.AddNonVoting:
 			r.addNonVoting(nodeid)
+			if m.Snapshot.Membership.Staged[nodeid] {
+				r.setStaged(nodeid, m.Snapshot.Membership.NonVotings[nodeid])
+			}
 		case pb.AddWitness:
 			r.addWitness(nodeid)
+		case pb.PromoteWitness:
+			r.promoteWitness(nodeid)
+		case pb.UpdateAddress:
+			// the progress of the remote is kept as is, only its address
+			// maintained outside of the raft protocol is changed
+			r.clearPendingConfigChange()
+		case pb.EnterJoint:
+			if err := r.enterJoint(m.Snapshot.Membership.Addresses); err != nil {
+				return err
+			}
+		case pb.LeaveJoint:
+			if err := r.leaveJoint(); err != nil {
+				return err
+			}
 		default:
 			panic("unexpected config change type")
 		}
@@ -1784,6 +2162,9 @@ func (r *raft) handleLeaderCheckQuorum(m pb.Message) error {
 	r.mustBeLeader()
 	if !r.leaderHasQuorum() {
 		plog.Warningf("%s has lost quorum", r.describe())
+		if err := r.reportUncommittedEntries(); err != nil {
+			return err
+		}
 		r.becomeFollower(r.term, NoLeader)
 	}
 	return nil
@@ -1802,6 +2183,12 @@ func (r *raft) handleLeaderPropose(m pb.Message) error {
 				plog.Warningf("%s dropped config change, pending change", r.describe())
 				r.reportDroppedConfigChange(m.Entries[i])
 				m.Entries[i] = pb.Entry{Type: pb.ApplicationEntry}
+			} else if ce, ok := r.checkMembershipChangeSafety(e); !ok {
+				r.reportDroppedConfigChange(m.Entries[i])
+				m.Entries[i] = pb.Entry{Type: pb.ApplicationEntry}
+				continue
+			} else {
+				m.Entries[i] = ce
 			}
 			r.setPendingConfigChange()
 		}
@@ -1846,6 +2233,10 @@ func (r *raft) handleLeaderReadIndex(m pb.Message) error {
 	}
 	if _, wok := r.witnesses[m.From]; wok {
 		plog.Errorf("%s dropped ReadIndex, witness node %d", r.describe(), m.From)
+	} else if !r.isReadIndexRequester(m.From) {
+		// e.g. a non-voting member removed with its ReadIndex in flight, it is no
+		// longer replicated to and can't catch up with the read index
+		plog.Warningf("%s dropped ReadIndex, unknown node %d", r.describe(), m.From)
 	} else if !r.isSingleNodeQuorum() {
 		if !r.hasCommittedEntryAtCurrentTerm() {
 			// leader doesn't know the commit value of the shard
@@ -1874,9 +2265,36 @@ func (r *raft) handleLeaderReadIndex(m pb.Message) error {
 	return nil
 }
 
+// isReadIndexRequester returns a boolean value indicating whether the leader
+// accepts ReadIndex requests from the specified node.
+func (r *raft) isReadIndexRequester(replicaID uint64) bool {
+	if replicaID == NoNode || replicaID == r.replicaID {
+		return true
+	}
+	if _, ok := r.remotes[replicaID]; ok {
+		return true
+	}
+	_, ok := r.nonVotings[replicaID]
+	return ok
+}
+
 func (r *raft) handleLeaderReplicateResp(m pb.Message, rp *remote) error {
 	r.mustBeLeader()
 	rp.setActive()
+	rp.lastActive = r.tickCount
+	rp.version = m.ProtocolVersion
+	if rp.promoted {
+		if !m.Reject || m.Hint != 0 {
+			return nil
+		}
+		plog.Infof("%s promoted witness %s restarted with empty log",
+			r.describe(), ReplicaID(m.From))
+		rp.promoted = false
+		rp.match = 0
+		rp.becomeRetry()
+		r.sendReplicateMessage(m.From)
+		return nil
+	}
 	if !m.Reject {
 		paused := rp.isPaused()
 		if rp.tryUpdate(m.LogIndex) {
@@ -1913,18 +2331,42 @@ func (r *raft) handleLeaderReplicateResp(m pb.Message, rp *remote) error {
 func (r *raft) handleLeaderHeartbeatResp(m pb.Message, rp *remote) error {
 	r.mustBeLeader()
 	rp.setActive()
-	rp.waitToRetry()
-	if rp.match < r.log.lastIndex() {
-		r.sendReplicateMessage(m.From)
+	rp.lastActive = r.tickCount
+	rp.version = m.ProtocolVersion
+	if m.Reject {
+		r.handleLostLog(m, rp)
+	} else {
+		rp.waitToRetry()
+		if rp.match < r.log.lastIndex() {
+			r.sendReplicateMessage(m.From)
+		}
 	}
 	// heartbeat response contains leadership confirmation requested as part of
 	// the ReadIndex protocol.
 	if m.Hint != 0 {
 		r.handleReadIndexLeaderConfirmation(m)
+	} else {
+		r.electionStats.heartbeatResponded(m.From)
 	}
 	return nil
 }
 
+// handleLostLog handles the rejected heartbeat from a Volatile replica
+// restarted with its log lost. Its match value is lowered to its last index
+// and entries are replicated again until it catches up with the commit index.
+func (r *raft) handleLostLog(m pb.Message, rp *remote) {
+	if rp.state == remoteSnapshot {
+		return
+	}
+	if rp.match > m.LogIndex {
+		plog.Warningf("%s %s lost its log, match %d, last index %d",
+			r.describe(), ReplicaID(m.From), rp.match, m.LogIndex)
+		rp.match = m.LogIndex
+	}
+	rp.becomeRetry()
+	r.sendReplicateMessage(m.From)
+}
+
 func (r *raft) handleLeaderTransfer(m pb.Message) error {
 	r.mustBeLeader()
 	target := m.Hint
@@ -1955,12 +2397,34 @@ func (r *raft) handleLeaderTransfer(m pb.Message) error {
 	return nil
 }
 
+func (r *raft) leaderTransferTargetCaughtUp(target uint64) (bool, bool) {
+	if !r.isLeader() {
+		return false, false
+	}
+	rp, ok := r.remotes[target]
+	if !ok {
+		return false, false
+	}
+	return rp.match == r.log.lastIndex(), true
+}
+
 func (r *raft) handleReadIndexLeaderConfirmation(m pb.Message) {
 	ctx := pb.SystemCtx{
 		Low:  m.Hint,
 		High: m.HintHigh,
 	}
-	ris := r.readIndex.confirm(ctx, m.From, r.quorum())
+	var ris []*readStatus
+	if r.isJoint() {
+		ris = r.readIndex.confirmWith(ctx, m.From,
+			func(confirmed map[uint64]struct{}) bool {
+				return r.jointHasQuorum(func(id uint64) bool {
+					_, ok := confirmed[id]
+					return ok || id == r.replicaID
+				})
+			})
+	} else {
+		ris = r.readIndex.confirm(ctx, m.From, r.quorum())
+	}
 	for _, s := range ris {
 		if s.from == NoNode || s.from == r.replicaID {
 			r.addReadyToRead(s.index, s.ctx)
@@ -2243,14 +2707,15 @@ func (r *raft) handleCandidateRequestVoteResp(m pb.Message) error {
 	count := r.handleVoteResp(m.From, m.Reject, false)
 	plog.Warningf("%s received %d votes and %d rejections, quorum is %d",
 		r.describe(), count, len(r.votes)-count, r.quorum())
+	won, lost := r.voteResult(count)
 	// 3rd paragraph section 5.2 of the raft paper
-	if count == r.quorum() {
+	if won {
 		if err := r.becomeLeader(); err != nil {
 			return err
 		}
 		// get the NoOP entry committed ASAP
 		r.broadcastReplicateMessage()
-	} else if len(r.votes)-count == r.quorum() {
+	} else if lost {
 		// etcd raft does this, it is not stated in the raft paper
 		r.becomeFollower(r.term, NoLeader)
 	}
@@ -2269,17 +2734,39 @@ func (r *raft) handlePreVoteCandidateRequestPreVoteResp(m pb.Message) error {
 	count := r.handleVoteResp(m.From, m.Reject, true)
 	plog.Warningf("%s received %d preVotes and %d rejections, quorum is %d",
 		r.describe(), count, len(r.votes)-count, r.quorum())
-	if count == r.quorum() {
+	won, lost := r.voteResult(count)
+	if won {
 		if err := r.campaign(); err != nil {
 			return err
 		}
-	} else if len(r.votes)-count == r.quorum() {
+	} else if lost {
 		// etcd raft does this, it is not stated in the raft paper
 		r.becomeFollower(r.term, NoLeader)
 	}
 	return nil
 }
 
+// reportUncommittedEntries reports entries not committed yet when the leader
+// is stepping down, payloads of such entries are not included.
+func (r *raft) reportUncommittedEntries() error {
+	if r.log.committed >= r.log.lastIndex() {
+		return nil
+	}
+	ents, err := r.log.entries(r.log.committed+1, noLimit)
+	if err != nil {
+		return err
+	}
+	for _, e := range ents {
+		r.uncommittedEntries = append(r.uncommittedEntries, pb.Entry{
+			Type:     e.Type,
+			Key:      e.Key,
+			ClientID: e.ClientID,
+			SeriesID: e.SeriesID,
+		})
+	}
+	return nil
+}
+
 func (r *raft) reportDroppedConfigChange(e pb.Entry) {
 	r.droppedEntries = append(r.droppedEntries, e)
 }
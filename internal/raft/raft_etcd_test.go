@@ -3016,6 +3016,8 @@ func (nw *network) filter(msgs []pb.Message) []pb.Message {
 				continue
 			}
 		}
+		// the protocol version is set by the node when sending the message
+		m.ProtocolVersion = pb.ProtocolVersion
 		mm = append(mm, m)
 	}
 	return mm
@@ -653,6 +653,33 @@ func TestNonVotingCanReadIndexQuorum2(t *testing.T) {
 	}
 }
 
+func TestReadIndexFromRemovedNonVotingIsDropped(t *testing.T) {
+	p1 := newTestRaft(1, []uint64{1, 2}, 10, 1, NewTestLogDB())
+	p2 := newTestRaft(2, []uint64{1, 2}, 10, 1, NewTestLogDB())
+	p3 := newTestNonVoting(3, []uint64{1, 2}, []uint64{3}, 10, 1, NewTestLogDB())
+	p1.addNonVoting(3)
+	p2.addNonVoting(3)
+	nt := newNetwork(p1, p2, p3)
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.Election})
+	if p1.state != leader {
+		t.Fatalf("failed to start election")
+	}
+	nt.send(pb.Message{From: 3, To: 3, Type: pb.ReadIndex, Hint: 12345})
+	if len(p3.readyToRead) != 1 {
+		t.Fatalf("ready to read len is not 1")
+	}
+	p3.readyToRead = nil
+	ne(p1.removeNode(3), t)
+	ne(p2.removeNode(3), t)
+	nt.send(pb.Message{From: 3, To: 3, Type: pb.ReadIndex, Hint: 12346})
+	if len(p3.readyToRead) != 0 {
+		t.Errorf("ReadIndex from removed nonVoting not dropped")
+	}
+	if len(p1.readIndex.pending) != 0 {
+		t.Errorf("ReadIndex from removed nonVoting is pending")
+	}
+}
+
 func TestNonVotingCanReceiveSnapshot(t *testing.T) {
 	members := pb.Membership{
 		Addresses:  make(map[uint64]string),
@@ -983,6 +1010,98 @@ func TestWitnessReplication(t *testing.T) {
 	}
 }
 
+func TestWitnessCanBeReplaced(t *testing.T) {
+	leader, _, _ := setUpLeaderAndWitness(t)
+	voters := leader.numVotingMembers()
+	ne(leader.replaceWitness(2, 3), t)
+	if _, ok := leader.witnesses[2]; ok {
+		t.Errorf("replaced witness not removed")
+	}
+	rp, ok := leader.witnesses[3]
+	if !ok {
+		t.Fatalf("new witness not added")
+	}
+	if rp.match != 0 || rp.next != leader.log.lastIndex()+1 {
+		t.Errorf("unexpected progress, match %d, next %d", rp.match, rp.next)
+	}
+	if leader.numVotingMembers() != voters {
+		t.Errorf("voting members changed, %d vs %d",
+			leader.numVotingMembers(), voters)
+	}
+}
+
+func TestPromotedWitnessReceivesApplicationEntries(t *testing.T) {
+	leader, witness, nt := setUpLeaderAndWitness(t)
+	leader.promoteWitness(2)
+	if _, ok := leader.witnesses[2]; ok {
+		t.Fatalf("witness not removed")
+	}
+	rp, ok := leader.remotes[2]
+	if !ok {
+		t.Fatalf("promoted witness not added as regular node")
+	}
+	if rp.match != 0 || rp.next != leader.log.lastIndex()+1 {
+		t.Errorf("progress info inherited, match %d, next %d", rp.match, rp.next)
+	}
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.Propose, Entries: []pb.Entry{{Cmd: []byte("test-data")}}})
+	lastIndex := leader.log.lastIndex()
+	ents, err := witness.log.getEntries(lastIndex, lastIndex+1, math.MaxUint64)
+	if err != nil {
+		t.Fatalf("failed to get entries %v", err)
+	}
+	if len(ents) != 1 || ents[0].Type != pb.ApplicationEntry ||
+		string(ents[0].Cmd) != "test-data" {
+		t.Errorf("unexpected entries %v", ents)
+	}
+	// the witness is going to drop its log, its responses are ignored
+	if rp.match != 0 || !rp.promoted {
+		t.Errorf("response from promoted witness not ignored, match %d", rp.match)
+	}
+	ne(leader.Handle(pb.Message{
+		From:     2,
+		To:       1,
+		Type:     pb.ReplicateResp,
+		Term:     leader.term,
+		LogIndex: rp.next - 1,
+		Reject:   true,
+	}), t)
+	if rp.promoted || rp.next != 1 {
+		t.Errorf("progress not reset, next %d", rp.next)
+	}
+}
+
+func TestReplicaWithLostLogIsCaughtUpByLeader(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.Election})
+	for i := 0; i < 3; i++ {
+		nt.send(pb.Message{From: 1, To: 1, Type: pb.Propose,
+			Entries: []pb.Entry{{Cmd: []byte("test-data")}}})
+	}
+	leader := nt.peers[1].(*raft)
+	if leader.remotes[3].match != leader.log.lastIndex() {
+		t.Fatalf("unexpected match %d", leader.remotes[3].match)
+	}
+	// replica 3 is restarted with its log lost
+	lost := newTestRaft(3, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+	lost.logLost = true
+	nt.peers[3] = lost
+	if lost.canGrantVote(pb.Message{From: 2, Term: leader.term + 1}) {
+		t.Errorf("replica with lost log granted vote")
+	}
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.LeaderHeartbeat})
+	if lost.logLost {
+		t.Errorf("lost log not recovered")
+	}
+	if lost.log.lastIndex() != leader.log.lastIndex() ||
+		lost.log.committed != leader.log.committed {
+		t.Errorf("not caught up, last index %d, committed %d",
+			lost.log.lastIndex(), lost.log.committed)
+	}
+	if leader.remotes[3].match != leader.log.lastIndex() {
+		t.Errorf("unexpected match %d", leader.remotes[3].match)
+	}
+}
+
 func TestApplicationMessageSentToWitnessIsEmpty(t *testing.T) {
 	_, witness, _ := setUpLeaderAndWitness(t)
 	expectedEntry := pb.Entry{
@@ -1026,7 +1145,14 @@ func TestConfigChangeMessageSentToWitnessIsEmpty(t *testing.T) {
 
 func TestWitnessSnapshot(t *testing.T) {
 	leader, _, _ := setUpLeaderAndWitness(t)
-	ss := pb.Snapshot{Index: 10, Term: 2}
+	ss := pb.Snapshot{
+		Index:       10,
+		Term:        2,
+		Filepath:    "snapshot.gbsnap",
+		FileSize:    1024,
+		OnDiskIndex: 8,
+		Dummy:       true,
+	}
 	if err := leader.log.logdb.ApplySnapshot(ss); err != nil {
 		t.Errorf("apply snapshot failed %v", err)
 	}
@@ -1038,6 +1164,10 @@ func TestWitnessSnapshot(t *testing.T) {
 		msg.Snapshot.Term != 2 || !msg.Snapshot.Witness || msg.Snapshot.Dummy {
 		t.Errorf("unexpected message values")
 	}
+	if msg.Snapshot.Filepath != "" || msg.Snapshot.FileSize != 0 ||
+		msg.Snapshot.OnDiskIndex != 0 {
+		t.Errorf("snapshot data not removed, %+v", msg.Snapshot)
+	}
 }
 
 func TestNonWitnessCanNotAddItselfAsWitness(t *testing.T) {
@@ -1957,6 +2087,37 @@ func TestHasConfigChangeToApply(t *testing.T) {
 	}
 }
 
+func TestLazyReplayOnlyChecksCommittedConfigChangeEntries(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 5, 1, NewTestLogDB())
+	r.hasNotAppliedConfigChange = nil
+	r.lazyReplay = true
+	ents := []pb.Entry{
+		{Type: pb.ApplicationEntry, Index: 1, Term: 1},
+		{Type: pb.ApplicationEntry, Index: 2, Term: 1},
+		{Type: pb.ConfigChangeEntry, Index: 3, Term: 1},
+		{Type: pb.ApplicationEntry, Index: 4, Term: 1},
+	}
+	r.log.append(ents)
+	tests := []struct {
+		applied   uint64
+		committed uint64
+		pending   bool
+	}{
+		{0, 2, false},
+		{0, 3, true},
+		{2, 4, true},
+		{3, 4, false},
+		{4, 4, false},
+	}
+	for idx, tt := range tests {
+		r.log.committed = tt.committed
+		r.setApplied(tt.applied)
+		if v := r.hasConfigChangeToApply(); v != tt.pending {
+			t.Errorf("%d, pending config change %t, want %t", idx, v, tt.pending)
+		}
+	}
+}
+
 func TestPendingConfigChangeFlag(t *testing.T) {
 	r := newTestRaft(1, []uint64{1, 2, 3}, 5, 1, NewTestLogDB())
 	if r.hasPendingConfigChange() {
@@ -2096,6 +2257,32 @@ func TestHandleLeaderCheckQuorum(t *testing.T) {
 	}
 }
 
+func TestLeaderReportsUncommittedEntriesWhenLosingQuorum(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 5, 1, NewTestLogDB())
+	r.checkQuorum = true
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	ne(r.Handle(pb.Message{From: 1, To: 1, Type: pb.Propose,
+		Entries: []pb.Entry{{Key: 100, ClientID: 2, SeriesID: 3, Cmd: []byte("v")}}}), t)
+	for i := uint64(0); i < r.electionTimeout; i++ {
+		ne(r.tick(), t)
+	}
+	if r.state != follower || r.leaderID != NoLeader {
+		t.Fatalf("leader didn't step down")
+	}
+	if r.leaderUpdate == nil || r.leaderUpdate.LeaderID != NoLeader {
+		t.Errorf("leader update not set")
+	}
+	// the noop entry appended by the leader is also uncommitted
+	if len(r.uncommittedEntries) != 2 {
+		t.Fatalf("unexpected uncommitted entries %v", r.uncommittedEntries)
+	}
+	e := r.uncommittedEntries[1]
+	if e.Key != 100 || e.ClientID != 2 || e.SeriesID != 3 || len(e.Cmd) != 0 {
+		t.Errorf("unexpected entry %v", e)
+	}
+}
+
 func TestReadyToReadList(t *testing.T) {
 	r := newTestRaft(1, []uint64{1, 2}, 5, 1, NewTestLogDB())
 	if len(r.readyToRead) != 0 {
@@ -3199,6 +3386,64 @@ func TestRateLimitMessageIsSentByNonLeader(t *testing.T) {
 	testRateLimitMessageIsSentByNonLeader(NoLeader, false, t)
 }
 
+func TestFollowerNeededIndex(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 5, 1, NewTestLogDB())
+	if idx := r.followerNeededIndex(); idx != r.log.lastIndex()+1 {
+		t.Errorf("unexpected index %d on non-leader", idx)
+	}
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	ne(r.appendEntries(make([]pb.Entry, 5)), t)
+	r.remotes[2].match = 5
+	r.remotes[3].match = 3
+	r.remotes[1].match = 1
+	if idx := r.followerNeededIndex(); idx != 4 {
+		t.Errorf("unexpected index %d, want 4", idx)
+	}
+}
+
+func TestSavedEntriesAreReleasedByLeader(t *testing.T) {
+	r := newRateLimitedTestRaft(1, []uint64{1, 2}, 5, 1, NewTestLogDB())
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	ents := []pb.Entry{
+		{Type: pb.ApplicationEntry, Cmd: make([]byte, testRateLimit/2)},
+		{Type: pb.ApplicationEntry, Cmd: make([]byte, testRateLimit/2)},
+	}
+	ne(r.appendEntries(ents), t)
+	last := r.log.lastIndex()
+	saved := r.log.entriesToSave()
+	ne(r.log.logdb.Append(saved[:len(saved)-1]), t)
+	r.log.inmem.savedLogTo(last-1, r.term)
+	r.remotes[2].match = last - 1
+	// saved entries are not released until they are applied
+	r.releaseInMemLog()
+	if r.log.inmem.markerIndex != 1 {
+		t.Errorf("unapplied entries released")
+	}
+	r.log.commitTo(last - 1)
+	r.setApplied(last - 1)
+	r.releaseInMemLog()
+	if r.log.inmem.markerIndex != last {
+		t.Errorf("marker index %d, want %d", r.log.inmem.markerIndex, last)
+	}
+	ret := r.getStatus().InMemRetention
+	if ret.Unpersisted != r.rl.Get() || ret.Unapplied != 0 ||
+		ret.FollowerNeeded != 0 {
+		t.Errorf("unexpected retention %+v", ret)
+	}
+	if r.rl.RateLimited() {
+		t.Errorf("unexpectedly rate limited")
+	}
+	got, err := r.log.entries(last-1, math.MaxUint64)
+	if err != nil {
+		t.Fatalf("failed to get entries %v", err)
+	}
+	if len(got) != 2 {
+		t.Errorf("released entries not available")
+	}
+}
+
 func TestInMemoryEntriesSliceCanBeResized(t *testing.T) {
 	r := newTestRaft(1, []uint64{1}, 5, 1, NewTestLogDB())
 	oldcap := cap(r.log.inmem.entries)
@@ -3315,7 +3560,7 @@ func TestInconsistentRaftConfig(t *testing.T) {
 		{pb.RequestVote, true, false},
 		{pb.RequestVote, false, false},
 		{pb.RequestPreVote, true, false},
-		{pb.RequestPreVote, false, true},
+		{pb.RequestPreVote, false, false},
 		{pb.RequestPreVoteResp, true, false},
 		{pb.RequestPreVoteResp, false, true},
 	}
@@ -3329,6 +3574,80 @@ func TestInconsistentRaftConfig(t *testing.T) {
 	}
 }
 
+// rejoinPartitionedNode isolates the replica 3 of an elected three replicas
+// shard, lets it campaign several times while the shard makes progress and
+// then brings it back to campaign again.
+func rejoinPartitionedNode(t *testing.T, preVote bool) (*raft, *raft) {
+	a := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+	b := newTestRaft(2, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+	c := newTestRaft(3, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+	a.preVote = preVote
+	b.preVote = preVote
+	c.preVote = preVote
+	nt := newNetwork(a, b, c)
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.Election})
+	if a.state != leader || a.term != 1 {
+		t.Fatalf("leader not elected")
+	}
+	nt.isolate(3)
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.Propose,
+		Entries: []pb.Entry{{Cmd: []byte("test-data")}}})
+	for i := 0; i < 5; i++ {
+		nt.send(pb.Message{From: 3, To: 3, Type: pb.Election})
+	}
+	nt.recover()
+	nt.send(pb.Message{From: 3, To: 3, Type: pb.Election})
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.LeaderHeartbeat})
+	return a, c
+}
+
+func TestRejoiningNodeDoesNotDisruptLeaderWithPreVote(t *testing.T) {
+	a, c := rejoinPartitionedNode(t, true)
+	if a.state != leader || a.term != 1 {
+		t.Errorf("leader disrupted, state %s, term %d", a.state, a.term)
+	}
+	if c.state != follower || c.term != 1 {
+		t.Errorf("unexpected state %s, term %d", c.state, c.term)
+	}
+}
+
+func TestRejoiningNodeDisruptsLeaderWithoutPreVote(t *testing.T) {
+	a, c := rejoinPartitionedNode(t, false)
+	if a.state == leader || a.term != c.term || a.term <= 1 {
+		t.Errorf("leader not disrupted, state %s, term %d", a.state, a.term)
+	}
+}
+
+func TestElectionWithMixedPreVoteConfig(t *testing.T) {
+	for _, candidatePreVote := range []bool{true, false} {
+		a := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+		b := newTestRaft(2, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+		c := newTestRaft(3, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+		a.preVote = candidatePreVote
+		b.preVote = !candidatePreVote
+		c.preVote = !candidatePreVote
+		nt := newNetwork(a, b, c)
+		nt.send(pb.Message{From: 1, To: 1, Type: pb.Election})
+		if a.state != leader || a.term != 1 {
+			t.Errorf("preVote %t, state %s, term %d",
+				candidatePreVote, a.state, a.term)
+		}
+		if b.state != follower || c.state != follower {
+			t.Errorf("preVote %t, unexpected follower state", candidatePreVote)
+		}
+	}
+}
+
+func TestPreVoteRespIsDroppedWhenPreVoteIsDisabled(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+	r.becomeFollower(1, NoLeader)
+	ne(r.Handle(pb.Message{From: 2, To: 1,
+		Type: pb.RequestPreVoteResp, Term: 2}), t)
+	if r.term != 1 || r.state != follower || len(r.msgs) != 0 {
+		t.Errorf("RequestPreVoteResp not dropped")
+	}
+}
+
 func TestCastVoteToDifferentNodesIsAllowed(t *testing.T) {
 	a := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
 	a.preVote = true
@@ -3453,3 +3772,178 @@ func TestSetLeaderIDWillSetLeaderInfo(t *testing.T) {
 	assert.Equal(t, uint64(100), r.leaderID)
 	assert.Equal(t, &pb.LeaderUpdate{LeaderID: 100, Term: 200}, r.leaderUpdate)
 }
+
+func TestLeaderTransferTargetCaughtUp(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.Election})
+	lead := nt.peers[1].(*raft)
+	if caughtUp, ok := lead.leaderTransferTargetCaughtUp(2); !ok || !caughtUp {
+		t.Errorf("caughtUp %t, ok %t", caughtUp, ok)
+	}
+	nt.isolate(3)
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.Propose, Entries: []pb.Entry{{}}})
+	if caughtUp, ok := lead.leaderTransferTargetCaughtUp(3); !ok || caughtUp {
+		t.Errorf("caughtUp %t, ok %t", caughtUp, ok)
+	}
+	if _, ok := lead.leaderTransferTargetCaughtUp(4); ok {
+		t.Errorf("unknown target checked")
+	}
+	follower := nt.peers[2].(*raft)
+	if _, ok := follower.leaderTransferTargetCaughtUp(3); ok {
+		t.Errorf("target checked on follower")
+	}
+}
+
+// getCatchUpBytes returns the number of bytes sent by the leader to bring a
+// follower lagging 1k entries behind the first index of its log up to date,
+// the size of the snapshot image is counted when a snapshot is sent.
+func getCatchUpBytes(t *testing.T, maxEntriesOverSnapshot uint64) (uint64, bool) {
+	const lag = 1000
+	const compactTo = 1500
+	const lastIndex = 2000
+	storage := NewTestLogDB().(*TestLogDB)
+	storage.retain = true
+	ents := make([]pb.Entry, 0, lastIndex)
+	for i := uint64(1); i <= lastIndex; i++ {
+		ents = append(ents, pb.Entry{Index: i, Term: 1, Cmd: make([]byte, 16)})
+	}
+	if err := storage.Append(ents); err != nil {
+		t.Fatalf("failed to append %v", err)
+	}
+	ss := pb.Snapshot{
+		Index:      compactTo,
+		Term:       1,
+		Membership: getTestMembership([]uint64{1, 2}),
+		// snapshot image of a 1MB state machine
+		FileSize: 1024 * 1024,
+	}
+	if err := storage.CreateSnapshot(ss); err != nil {
+		t.Fatalf("failed to create snapshot %v", err)
+	}
+	if err := storage.Compact(compactTo); err != nil {
+		t.Fatalf("failed to compact %v", err)
+	}
+	storage.SetState(pb.State{Term: 1, Commit: lastIndex})
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+	r.maxEntriesOverSnapshot = maxEntriesOverSnapshot
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	r.readMessages()
+	rp := r.remotes[2]
+	rp.match = compactTo - lag
+	rp.next = rp.match + 1
+	rp.setActive()
+	r.sendReplicateMessage(2)
+	total := uint64(0)
+	snapshot := false
+	for msgs := r.readMessages(); len(msgs) > 0; msgs = r.readMessages() {
+		for _, m := range msgs {
+			if m.To != 2 {
+				continue
+			}
+			total += uint64(m.Size())
+			if m.Type == pb.InstallSnapshot {
+				total += m.Snapshot.FileSize
+				snapshot = true
+			} else if m.Type == pb.Replicate && len(m.Entries) > 0 {
+				ne(r.Handle(pb.Message{
+					From:     2,
+					To:       1,
+					Type:     pb.ReplicateResp,
+					Term:     r.term,
+					LogIndex: m.Entries[len(m.Entries)-1].Index,
+				}), t)
+			}
+		}
+	}
+	if !snapshot && rp.match != r.log.lastIndex() {
+		t.Fatalf("follower not caught up, match %d, last index %d",
+			rp.match, r.log.lastIndex())
+	}
+	return total, snapshot
+}
+
+func TestRetainedEntriesAreSentToModeratelyLaggingFollower(t *testing.T) {
+	before, snapshot := getCatchUpBytes(t, 0)
+	if !snapshot {
+		t.Fatalf("snapshot not sent")
+	}
+	after, snapshot := getCatchUpBytes(t, 1000)
+	if snapshot {
+		t.Fatalf("snapshot sent to moderately lagging follower")
+	}
+	if after >= before {
+		t.Errorf("sending retained entries transferred %d bytes, snapshot %d",
+			after, before)
+	}
+	t.Logf("catch up bytes, snapshot: %d, retained entries: %d", before, after)
+}
+
+func TestSnapshotIsSentWhenFollowerLagsBeyondMaxEntriesOverSnapshot(t *testing.T) {
+	if _, snapshot := getCatchUpBytes(t, 999); !snapshot {
+		t.Errorf("snapshot not sent")
+	}
+}
+
+type testCampaignListener struct {
+	server.IRaftEventListener
+	suppressed []server.CampaignInfo
+}
+
+func (l *testCampaignListener) LeaderUpdated(info server.LeaderInfo) {}
+
+func (l *testCampaignListener) CampaignSuppressed(info server.CampaignInfo) {
+	l.suppressed = append(l.suppressed, info)
+}
+
+func TestCampaignDisabledNodeNeverCampaigns(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+	r.campaignDisabled = true
+	l := &testCampaignListener{}
+	r.events = l
+	term := r.term
+	for i := 0; i < 100; i++ {
+		ne(r.tick(), t)
+	}
+	ne(r.Handle(pb.Message{From: 2, To: 1, Type: pb.TimeoutNow, Term: term}), t)
+	if r.term != term || r.state != follower {
+		t.Errorf("term %d, state %s, want term %d follower", r.term, r.state, term)
+	}
+	for _, m := range r.msgs {
+		if m.Type == pb.RequestVote || m.Type == pb.RequestPreVote {
+			t.Errorf("unexpected message %s", m.Type)
+		}
+	}
+	if len(l.suppressed) != 1 || l.suppressed[0].Term != term {
+		t.Fatalf("unexpected events %v", l.suppressed)
+	}
+	r.becomeFollower(term+1, NoLeader)
+	for i := 0; i < 100; i++ {
+		ne(r.tick(), t)
+	}
+	if len(l.suppressed) != 2 || l.suppressed[1].Term != term+1 {
+		t.Errorf("unexpected events %v", l.suppressed)
+	}
+}
+
+func TestLogFieldsIncludeLogIndexes(t *testing.T) {
+	r := newTestRaft(1, []uint64{1}, 10, 1, NewTestLogDB())
+	r.log.append([]pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}})
+	r.log.commitTo(2)
+	r.log.processed = 1
+	fields := make(map[string]interface{})
+	for _, f := range r.logFields() {
+		fields[f.Key] = f.Value
+	}
+	expected := map[string]uint64{
+		"first":     r.log.firstIndex(),
+		"last":      r.log.lastIndex(),
+		"committed": r.log.committed,
+		"applied":   r.log.processed,
+	}
+	for key, value := range expected {
+		if v, ok := fields[key]; !ok || v.(uint64) != value {
+			t.Errorf("field %s, got %v, want %d", key, v, value)
+		}
+	}
+}
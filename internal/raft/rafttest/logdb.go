@@ -0,0 +1,175 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rafttest
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/lni/dragonboat/v4/internal/raft"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// logDB is a raft.ILogDB backed by a []pb.Entry, it plays the role of both
+// the LogReader and the LogDB of a replica. Its content survives restarts of
+// the replica.
+type logDB struct {
+	entries     []pb.Entry
+	markerIndex uint64
+	markerTerm  uint64
+	snapshot    pb.Snapshot
+	state       pb.State
+}
+
+var _ raft.ILogDB = (*logDB)(nil)
+
+func newLogDB() *logDB {
+	return &logDB{entries: make([]pb.Entry, 0)}
+}
+
+func (db *logDB) SetState(s pb.State) {
+	db.state = s
+}
+
+func (db *logDB) NodeState() (pb.State, pb.Membership) {
+	return db.state, db.snapshot.Membership
+}
+
+func (db *logDB) Snapshot() pb.Snapshot {
+	return db.snapshot
+}
+
+func (db *logDB) ApplySnapshot(ss pb.Snapshot) error {
+	if db.snapshot.Index >= ss.Index {
+		return raft.ErrSnapshotOutOfDate
+	}
+	db.snapshot = ss
+	db.markerIndex = ss.Index
+	db.markerTerm = ss.Term
+	db.entries = make([]pb.Entry, 0)
+	return nil
+}
+
+func (db *logDB) CreateSnapshot(ss pb.Snapshot) error {
+	if db.snapshot.Index >= ss.Index {
+		return raft.ErrSnapshotOutOfDate
+	}
+	db.snapshot = ss
+	return nil
+}
+
+func (db *logDB) GetRange() (uint64, uint64) {
+	return db.firstIndex(), db.lastIndex()
+}
+
+func (db *logDB) firstIndex() uint64 {
+	return db.markerIndex + 1
+}
+
+func (db *logDB) lastIndex() uint64 {
+	return db.markerIndex + uint64(len(db.entries))
+}
+
+func (db *logDB) SetRange(firstIndex uint64, length uint64) {
+	panic("not implemented")
+}
+
+func (db *logDB) Term(index uint64) (uint64, error) {
+	if index == db.markerIndex {
+		return db.markerTerm, nil
+	}
+	ents, err := db.Entries(index, index+1, math.MaxUint64)
+	if err != nil {
+		return 0, err
+	}
+	if len(ents) == 0 {
+		return 0, nil
+	}
+	return ents[0].Term, nil
+}
+
+func (db *logDB) Append(entries []pb.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	first := db.firstIndex()
+	if db.markerIndex+uint64(len(entries)) < first {
+		return nil
+	}
+	if first > entries[0].Index {
+		entries = entries[first-entries[0].Index:]
+	}
+	offset := entries[0].Index - db.markerIndex
+	if uint64(len(db.entries)+1) > offset {
+		db.entries = db.entries[:offset-1]
+	} else if uint64(len(db.entries)+1) < offset {
+		panic(fmt.Sprintf("found a hole last index %d, first incoming index %d",
+			db.lastIndex(), entries[0].Index))
+	}
+	db.entries = append(db.entries, entries...)
+	return nil
+}
+
+func (db *logDB) Entries(low uint64,
+	high uint64, maxSize uint64) ([]pb.Entry, error) {
+	if low <= db.markerIndex {
+		return nil, raft.ErrCompacted
+	}
+	if high > db.lastIndex()+1 {
+		return nil, raft.ErrUnavailable
+	}
+	if len(db.entries) == 0 {
+		return nil, raft.ErrUnavailable
+	}
+	ents := db.entries[low-db.markerIndex-1 : high-db.markerIndex-1]
+	return limitSize(ents, maxSize), nil
+}
+
+func (db *logDB) Compact(index uint64) error {
+	if index <= db.markerIndex {
+		return raft.ErrCompacted
+	}
+	if index > db.lastIndex() {
+		return raft.ErrUnavailable
+	}
+	term, err := db.Term(index)
+	if err != nil {
+		return err
+	}
+	db.entries = append([]pb.Entry{}, db.entries[index-db.markerIndex:]...)
+	db.markerIndex = index
+	db.markerTerm = term
+	return nil
+}
+
+func (db *logDB) RetainedEntries(low uint64,
+	high uint64, maxSize uint64) ([]pb.Entry, error) {
+	return nil, raft.ErrCompacted
+}
+
+func limitSize(ents []pb.Entry, limit uint64) []pb.Entry {
+	if len(ents) == 0 {
+		return ents
+	}
+	total := ents[0].SizeUpperLimit()
+	var inc int
+	for inc = 1; inc < len(ents); inc++ {
+		total += ents[inc].SizeUpperLimit()
+		if uint64(total) > limit {
+			break
+		}
+	}
+	return ents[:inc]
+}
@@ -0,0 +1,704 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package rafttest is a deterministic single-threaded harness for stepping Raft
+nodes implemented by the internal/raft package.
+
+A Network contains a group of Raft nodes connected by a message bus, nothing
+happens unless the test moves the logical clock forward using Tick or delivers
+the queued messages using Deliver and DeliverAll. Updates returned by the Raft
+nodes are saved into in-memory logs, committed entries are applied to a simple
+state machine recording payloads of applied entries. Election timeouts are
+randomized using a seeded source of randomness and messages are queued in a
+stable order, the same steps always lead to the same state, ordering dependent
+behaviors such as election races or config changes interleaved with snapshots
+can thus be reproduced step by step and inspected between steps.
+*/
+package rafttest
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/raft"
+	"github.com/lni/dragonboat/v4/internal/server"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	// maxDeliveries is the max number of messages delivered by DeliverAll,
+	// it is only reached when the nodes keep exchanging messages on their own.
+	maxDeliveries = 100000
+	// maxUpdates is the max number of consecutive updates processed for a
+	// node after it has been stepped.
+	maxUpdates = 1000
+)
+
+var (
+	// ErrUnknownNode indicates that the specified node is not in the network.
+	ErrUnknownNode = errors.New("unknown node")
+	// ErrNodeStopped indicates that the specified node is stopped.
+	ErrNodeStopped = errors.New("node stopped")
+)
+
+// Config is the configuration of a Network.
+type Config struct {
+	// Replicas is the list of replica IDs of the initial members.
+	Replicas []uint64
+	// Seed is the seed of the source of randomness used for randomizing
+	// election timeouts.
+	Seed int64
+	// ElectionRTT is the election timeout in ticks, the default value is 10.
+	ElectionRTT uint64
+	// HeartbeatRTT is the heartbeat interval in ticks, the default value is 1.
+	HeartbeatRTT uint64
+	// CheckQuorum and PreVote are the same as those in config.Config.
+	CheckQuorum bool
+	PreVote     bool
+}
+
+// Matcher selects messages to be dropped by DropNext.
+type Matcher func(m pb.Message) bool
+
+// MessageType returns a Matcher selecting messages of the specified type.
+func MessageType(t pb.MessageType) Matcher {
+	return func(m pb.Message) bool { return m.Type == t }
+}
+
+// Between returns a Matcher selecting messages sent from one node to another.
+func Between(from uint64, to uint64) Matcher {
+	return func(m pb.Message) bool { return m.From == from && m.To == to }
+}
+
+// And returns a Matcher selecting messages selected by all matchers.
+func And(matchers ...Matcher) Matcher {
+	return func(m pb.Message) bool {
+		for _, f := range matchers {
+			if !f(m) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+type link struct {
+	from uint64
+	to   uint64
+}
+
+// Node is a Raft node in the Network.
+type Node struct {
+	id         uint64
+	peer       raft.Peer
+	logdb      *logDB
+	stopped    bool
+	applied    uint64
+	data       []string
+	membership pb.Membership
+}
+
+// ID returns the replica ID of the node.
+func (n *Node) ID() uint64 {
+	return n.id
+}
+
+// Status returns the Raft state of the node.
+func (n *Node) Status() server.RaftStatus {
+	return n.peer.GetStatus()
+}
+
+// Stopped returns a boolean value indicating whether the node is stopped.
+func (n *Node) Stopped() bool {
+	return n.stopped
+}
+
+// Applied returns the index of the last applied entry.
+func (n *Node) Applied() uint64 {
+	return n.applied
+}
+
+// Data returns payloads of all applied application entries.
+func (n *Node) Data() []string {
+	return append([]string{}, n.data...)
+}
+
+// Log returns entries saved in the log of the node, entries compacted by a
+// snapshot are not included.
+func (n *Node) Log() []pb.Entry {
+	return append([]pb.Entry{}, n.logdb.entries...)
+}
+
+// Snapshot returns the latest snapshot of the node.
+func (n *Node) Snapshot() pb.Snapshot {
+	return n.logdb.snapshot
+}
+
+// Membership returns the membership known to the state machine of the node.
+func (n *Node) Membership() pb.Membership {
+	return copyMembership(n.membership)
+}
+
+// Network is a group of Raft nodes stepped by a single goroutine.
+type Network struct {
+	cfg       Config
+	rand      *rand.Rand
+	nodes     map[uint64]*Node
+	queue     []pb.Message
+	cut       map[link]struct{}
+	drops     []Matcher
+	snapshots map[uint64][]string
+	trace     []string
+}
+
+// New creates a Network with all initial members started and bootstrapped.
+func New(cfg Config) *Network {
+	if cfg.ElectionRTT == 0 {
+		cfg.ElectionRTT = 10
+	}
+	if cfg.HeartbeatRTT == 0 {
+		cfg.HeartbeatRTT = 1
+	}
+	n := &Network{
+		cfg:       cfg,
+		rand:      rand.New(rand.NewSource(cfg.Seed)),
+		nodes:     make(map[uint64]*Node),
+		cut:       make(map[link]struct{}),
+		snapshots: make(map[uint64][]string),
+	}
+	addresses := make([]raft.PeerAddress, 0, len(cfg.Replicas))
+	for _, id := range cfg.Replicas {
+		addresses = append(addresses, raft.PeerAddress{
+			ReplicaID: id,
+			Address:   address(id),
+		})
+	}
+	for _, id := range n.sortedIDs(cfg.Replicas) {
+		n.launch(&Node{id: id, logdb: newLogDB()}, addresses, true, true)
+	}
+	return n
+}
+
+// Node returns the specified node, it returns nil when there is no such node.
+func (n *Network) Node(id uint64) *Node {
+	return n.nodes[id]
+}
+
+// IDs returns the sorted replica IDs of all nodes.
+func (n *Network) IDs() []uint64 {
+	ids := make([]uint64, 0, len(n.nodes))
+	for id := range n.nodes {
+		ids = append(ids, id)
+	}
+	return n.sortedIDs(ids)
+}
+
+// Leader returns the replica ID of the running leader with the highest term,
+// 0 is returned when there is no running leader.
+func (n *Network) Leader() uint64 {
+	var leaderID, term uint64
+	for _, id := range n.IDs() {
+		node := n.nodes[id]
+		st := node.Status()
+		if !node.stopped && st.State == "Leader" && st.Term > term {
+			leaderID, term = id, st.Term
+		}
+	}
+	return leaderID
+}
+
+// Tick moves the logical clock of all running nodes forward by the specified
+// number of ticks. Messages sent by the nodes are queued, they are not
+// delivered.
+func (n *Network) Tick(count int) {
+	for i := 0; i < count; i++ {
+		for _, id := range n.IDs() {
+			if !n.nodes[id].stopped {
+				n.tick(n.nodes[id])
+			}
+		}
+	}
+}
+
+// TickNode moves the logical clock of the specified node forward by the
+// specified number of ticks.
+func (n *Network) TickNode(id uint64, count int) error {
+	node, err := n.running(id)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		n.tick(node)
+	}
+	return nil
+}
+
+// Advance moves the logical clock of all running nodes forward by one tick
+// and delivers all messages for the specified number of times.
+func (n *Network) Advance(count int) {
+	for i := 0; i < count; i++ {
+		n.Tick(1)
+		n.DeliverAll()
+	}
+}
+
+// Pending returns the number of queued messages.
+func (n *Network) Pending() int {
+	return len(n.queue)
+}
+
+// Deliver delivers the first queued message, it returns false when there is
+// no queued message. Messages sent to or from stopped nodes, messages sent
+// over cut links and messages selected by DropNext are dropped.
+func (n *Network) Deliver() bool {
+	if len(n.queue) == 0 {
+		return false
+	}
+	m := n.queue[0]
+	n.queue = n.queue[1:]
+	if n.dropped(m) {
+		n.trace = append(n.trace, "drop "+describeMessage(m))
+		if m.Type == pb.InstallSnapshot {
+			n.reportSnapshotStatus(m, true)
+		}
+		return true
+	}
+	n.trace = append(n.trace, describeMessage(m))
+	to := n.nodes[m.To]
+	if err := to.peer.Handle(m); err != nil {
+		panic(err)
+	}
+	n.process(to)
+	if m.Type == pb.InstallSnapshot {
+		n.reportSnapshotStatus(m, false)
+	}
+	return true
+}
+
+// DeliverAll delivers queued messages, including those sent in response,
+// until there is no queued message. It returns the number of delivered or
+// dropped messages.
+func (n *Network) DeliverAll() int {
+	count := 0
+	for n.Deliver() {
+		count++
+		if count > maxDeliveries {
+			panic("too many messages delivered")
+		}
+	}
+	return count
+}
+
+// Partition cuts the links between the specified nodes in both directions.
+func (n *Network) Partition(a uint64, b uint64) {
+	n.cut[link{from: a, to: b}] = struct{}{}
+	n.cut[link{from: b, to: a}] = struct{}{}
+}
+
+// Isolate cuts all links between the specified node and other nodes.
+func (n *Network) Isolate(id uint64) {
+	for _, other := range n.IDs() {
+		if other != id {
+			n.Partition(id, other)
+		}
+	}
+}
+
+// Heal restores all cut links.
+func (n *Network) Heal() {
+	n.cut = make(map[link]struct{})
+}
+
+// DropNext drops the next delivered message selected by the matcher.
+func (n *Network) DropNext(matcher Matcher) {
+	n.drops = append(n.drops, matcher)
+}
+
+// Propose proposes the specified payloads as application entries on the
+// specified node.
+func (n *Network) Propose(id uint64, payloads ...string) error {
+	node, err := n.running(id)
+	if err != nil {
+		return err
+	}
+	entries := make([]pb.Entry, 0, len(payloads))
+	for _, p := range payloads {
+		entries = append(entries, pb.Entry{Cmd: []byte(p)})
+	}
+	if err := node.peer.ProposeEntries(entries); err != nil {
+		return err
+	}
+	n.process(node)
+	return nil
+}
+
+// ProposeConfigChange proposes the specified config change on the specified
+// node.
+func (n *Network) ProposeConfigChange(id uint64, cc pb.ConfigChange) error {
+	node, err := n.running(id)
+	if err != nil {
+		return err
+	}
+	if cc.Address == "" && cc.ReplicaID != 0 {
+		cc.Address = address(cc.ReplicaID)
+	}
+	if err := node.peer.ProposeConfigChange(cc, 0); err != nil {
+		return err
+	}
+	n.process(node)
+	return nil
+}
+
+// TransferLeadership requests the specified leader to transfer its
+// leadership to the target node.
+func (n *Network) TransferLeadership(id uint64, target uint64) error {
+	node, err := n.running(id)
+	if err != nil {
+		return err
+	}
+	if err := node.peer.RequestLeaderTransfer(target); err != nil {
+		return err
+	}
+	n.process(node)
+	return nil
+}
+
+// AddNode starts a node with an empty log that joins the shard once it is
+// added by a config change.
+func (n *Network) AddNode(id uint64) *Node {
+	if _, ok := n.nodes[id]; ok {
+		panic(fmt.Sprintf("node %d already exist", id))
+	}
+	node := &Node{id: id, logdb: newLogDB()}
+	n.launch(node, nil, false, true)
+	return node
+}
+
+// Stop stops the specified node, messages sent to or from it are dropped.
+// Entries saved in its log are kept.
+func (n *Network) Stop(id uint64) error {
+	node, err := n.running(id)
+	if err != nil {
+		return err
+	}
+	node.stopped = true
+	return nil
+}
+
+// Restart restarts the specified stopped node from its log, the state machine
+// is recovered from the latest snapshot and committed entries are applied
+// again.
+func (n *Network) Restart(id uint64) error {
+	node, ok := n.nodes[id]
+	if !ok {
+		return ErrUnknownNode
+	}
+	if !node.stopped {
+		return errors.New("node not stopped")
+	}
+	n.launch(&Node{id: id, logdb: node.logdb}, nil, false, false)
+	return nil
+}
+
+// CreateSnapshot creates a snapshot of the state machine of the specified
+// node at its last applied index, entries up to the index are compacted from
+// its log. It returns the index of the snapshot.
+func (n *Network) CreateSnapshot(id uint64) (uint64, error) {
+	node, err := n.running(id)
+	if err != nil {
+		return 0, err
+	}
+	index := node.applied
+	term, err := node.logdb.Term(index)
+	if err != nil {
+		return 0, err
+	}
+	ss := pb.Snapshot{
+		ShardID:    1,
+		Index:      index,
+		Term:       term,
+		Membership: copyMembership(node.membership),
+		Type:       pb.RegularStateMachine,
+	}
+	if err := node.logdb.CreateSnapshot(ss); err != nil {
+		return 0, err
+	}
+	if err := node.logdb.Compact(index); err != nil {
+		return 0, err
+	}
+	n.snapshots[index] = node.Data()
+	return index, nil
+}
+
+// Trace returns descriptions of all delivered and dropped messages.
+func (n *Network) Trace() []string {
+	return append([]string{}, n.trace...)
+}
+
+func (n *Network) launch(node *Node,
+	addresses []raft.PeerAddress, initial bool, newNode bool) {
+	cfg := config.Config{
+		ShardID:      1,
+		ReplicaID:    node.id,
+		ElectionRTT:  n.cfg.ElectionRTT,
+		HeartbeatRTT: n.cfg.HeartbeatRTT,
+		CheckQuorum:  n.cfg.CheckQuorum,
+		PreVote:      n.cfg.PreVote,
+	}
+	node.peer = raft.Launch(cfg, node.logdb, nil, addresses, initial, newNode)
+	node.peer.SetRandomSource(n.rand.Uint64)
+	ss := node.logdb.snapshot
+	if !pb.IsEmptySnapshot(ss) {
+		node.applied = ss.Index
+		node.data = append([]string{}, n.snapshots[ss.Index]...)
+		node.membership = copyMembership(ss.Membership)
+		node.peer.NotifyRaftLastApplied(node.applied)
+	}
+	n.nodes[node.id] = node
+	n.process(node)
+}
+
+func (n *Network) running(id uint64) (*Node, error) {
+	node, ok := n.nodes[id]
+	if !ok {
+		return nil, ErrUnknownNode
+	}
+	if node.stopped {
+		return nil, ErrNodeStopped
+	}
+	return node, nil
+}
+
+func (n *Network) tick(node *Node) {
+	if err := node.peer.Tick(); err != nil {
+		panic(err)
+	}
+	n.process(node)
+}
+
+func (n *Network) dropped(m pb.Message) bool {
+	from, fok := n.nodes[m.From]
+	to, tok := n.nodes[m.To]
+	if !fok || !tok || from.stopped || to.stopped {
+		return true
+	}
+	if _, ok := n.cut[link{from: m.From, to: m.To}]; ok {
+		return true
+	}
+	for i, f := range n.drops {
+		if f(m) {
+			n.drops = append(n.drops[:i], n.drops[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// reportSnapshotStatus reports the result of a delivered or dropped snapshot
+// to its sender, it plays the role of the snapshot streaming transport.
+func (n *Network) reportSnapshotStatus(m pb.Message, reject bool) {
+	from, ok := n.nodes[m.From]
+	if !ok || from.stopped {
+		return
+	}
+	if err := from.peer.ReportSnapshotStatus(m.To, reject); err != nil {
+		panic(err)
+	}
+	n.process(from)
+}
+
+// process saves and applies all updates of the node in the same way as the
+// step and apply workers of a NodeHost, messages are queued in the order of
+// their target nodes.
+func (n *Network) process(node *Node) {
+	for i := 0; node.peer.HasUpdate(true); i++ {
+		if i > maxUpdates {
+			panic("too many updates")
+		}
+		ud, err := node.peer.GetUpdate(true, node.applied)
+		if err != nil {
+			panic(err)
+		}
+		if !pb.IsEmptySnapshot(ud.Snapshot) {
+			if err := node.logdb.ApplySnapshot(ud.Snapshot); err != nil &&
+				!errors.Is(err, raft.ErrSnapshotOutOfDate) {
+				panic(err)
+			}
+		}
+		if err := node.logdb.Append(ud.EntriesToSave); err != nil {
+			panic(err)
+		}
+		if !pb.IsEmptyState(ud.State) {
+			node.logdb.SetState(ud.State)
+		}
+		msgs := append([]pb.Message{}, ud.Messages...)
+		for i := range msgs {
+			// set by the node before sending the message
+			msgs[i].ProtocolVersion = pb.ProtocolVersion
+		}
+		sort.SliceStable(msgs, func(i, j int) bool {
+			return msgs[i].To < msgs[j].To
+		})
+		n.queue = append(n.queue, msgs...)
+		node.peer.Commit(ud)
+		if !pb.IsEmptySnapshot(ud.Snapshot) && ud.Snapshot.Index > node.applied {
+			n.restore(node, ud.Snapshot)
+		}
+		n.apply(node, ud.CommittedEntries)
+		node.peer.NotifyRaftLastApplied(node.applied)
+		if node.stopped {
+			return
+		}
+	}
+}
+
+func (n *Network) restore(node *Node, ss pb.Snapshot) {
+	data, ok := n.snapshots[ss.Index]
+	if !ok {
+		panic(fmt.Sprintf("snapshot %d not found", ss.Index))
+	}
+	node.applied = ss.Index
+	node.data = append([]string{}, data...)
+	node.membership = copyMembership(ss.Membership)
+	if err := node.peer.RestoreRemotes(ss); err != nil {
+		panic(err)
+	}
+}
+
+func (n *Network) apply(node *Node, entries []pb.Entry) {
+	for _, e := range entries {
+		if e.Index <= node.applied {
+			continue
+		}
+		node.applied = e.Index
+		if e.Type == pb.ConfigChangeEntry {
+			var cc pb.ConfigChange
+			pb.MustUnmarshal(&cc, e.Cmd)
+			n.applyConfigChange(node, cc, e.Index)
+		} else if len(e.Cmd) > 0 {
+			node.data = append(node.data, string(e.Cmd))
+		}
+		if node.stopped {
+			return
+		}
+	}
+}
+
+func (n *Network) applyConfigChange(node *Node,
+	cc pb.ConfigChange, index uint64) {
+	m := &node.membership
+	_, removed := m.Removed[cc.ReplicaID]
+	if len(cc.Inactive) > 0 || cc.LimitExceeded ||
+		(cc.Type != pb.RemoveNode && removed) {
+		if err := node.peer.RejectConfigChange(); err != nil {
+			panic(err)
+		}
+		return
+	}
+	if m.Addresses == nil {
+		*m = copyMembership(*m)
+	}
+	m.ConfigChangeId = index
+	switch cc.Type {
+	case pb.AddNode:
+		delete(m.NonVotings, cc.ReplicaID)
+		m.Addresses[cc.ReplicaID] = cc.Address
+	case pb.AddNonVoting:
+		m.NonVotings[cc.ReplicaID] = cc.Address
+	case pb.RemoveNode:
+		delete(m.Addresses, cc.ReplicaID)
+		delete(m.NonVotings, cc.ReplicaID)
+		m.Removed[cc.ReplicaID] = true
+	case pb.EnterJoint:
+		m.Outgoing = m.Addresses
+		m.Addresses = make(map[uint64]string)
+		for id, addr := range cc.Members {
+			delete(m.NonVotings, id)
+			m.Addresses[id] = addr
+		}
+	case pb.LeaveJoint:
+		for id := range m.Outgoing {
+			if _, ok := m.Addresses[id]; !ok {
+				m.Removed[id] = true
+			}
+		}
+		m.Outgoing = make(map[uint64]string)
+	default:
+		panic(fmt.Sprintf("config change type %s not supported", cc.Type))
+	}
+	if err := node.peer.ApplyConfigChange(cc); err != nil {
+		panic(err)
+	}
+	// removed nodes are stopped in the same way as NodeHost does
+	if _, ok := m.Removed[node.id]; ok {
+		node.stopped = true
+	}
+}
+
+func (n *Network) sortedIDs(ids []uint64) []uint64 {
+	result := append([]uint64{}, ids...)
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+func address(id uint64) string {
+	return fmt.Sprintf("node-%d", id)
+}
+
+func copyMembership(m pb.Membership) pb.Membership {
+	cp := func(src map[uint64]string) map[uint64]string {
+		dst := make(map[uint64]string, len(src))
+		for k, v := range src {
+			dst[k] = v
+		}
+		return dst
+	}
+	removed := make(map[uint64]bool, len(m.Removed))
+	for k, v := range m.Removed {
+		removed[k] = v
+	}
+	return pb.Membership{
+		ConfigChangeId: m.ConfigChangeId,
+		Addresses:      cp(m.Addresses),
+		NonVotings:     cp(m.NonVotings),
+		Witnesses:      cp(m.Witnesses),
+		Outgoing:       cp(m.Outgoing),
+		Removed:        removed,
+	}
+}
+
+func describeMessage(m pb.Message) string {
+	s := fmt.Sprintf("%d->%d %s term=%d", m.From, m.To, m.Type, m.Term)
+	switch m.Type {
+	case pb.Replicate:
+		s += fmt.Sprintf(" index=%d logterm=%d entries=%d commit=%d",
+			m.LogIndex, m.LogTerm, len(m.Entries), m.Commit)
+	case pb.ReplicateResp:
+		s += fmt.Sprintf(" index=%d reject=%t", m.LogIndex, m.Reject)
+	case pb.Heartbeat:
+		s += fmt.Sprintf(" commit=%d", m.Commit)
+	case pb.RequestVote, pb.RequestPreVote:
+		s += fmt.Sprintf(" index=%d logterm=%d", m.LogIndex, m.LogTerm)
+	case pb.RequestVoteResp, pb.RequestPreVoteResp:
+		s += fmt.Sprintf(" reject=%t", m.Reject)
+	case pb.InstallSnapshot:
+		s += fmt.Sprintf(" snapshot=%d", m.Snapshot.Index)
+	}
+	return s
+}
@@ -0,0 +1,292 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rafttest
+
+import (
+	"strings"
+	"testing"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func newTestNetwork(t *testing.T, cfg Config) *Network {
+	if len(cfg.Replicas) == 0 {
+		cfg.Replicas = []uint64{1, 2, 3}
+	}
+	n := New(cfg)
+	if err := n.ElectLeader(1); err != nil {
+		t.Fatalf("failed to elect leader %v", err)
+	}
+	if err := n.Commit("a"); err != nil {
+		t.Fatalf("failed to commit %v", err)
+	}
+	return n
+}
+
+func advanceUntilLeader(t *testing.T, n *Network, ids ...uint64) uint64 {
+	for i := 0; i < 100; i++ {
+		for _, id := range ids {
+			if n.Leader() == id {
+				return id
+			}
+		}
+		n.Advance(1)
+	}
+	t.Fatalf("no leader elected\n%s", n.Describe())
+	return 0
+}
+
+func TestSameStepsLeadToSameState(t *testing.T) {
+	run := func(seed int64) (string, []string) {
+		n := New(Config{Replicas: []uint64{1, 2, 3, 4, 5}, Seed: seed})
+		advanceUntilLeader(t, n, n.IDs()...)
+		if err := n.Commit("a", "b"); err != nil {
+			t.Fatalf("failed to commit %v", err)
+		}
+		n.CheckSafety(t)
+		return n.Describe(), n.Trace()
+	}
+	for seed := int64(0); seed < 5; seed++ {
+		s1, t1 := run(seed)
+		s2, t2 := run(seed)
+		CheckGolden(t, s2, s1)
+		CheckGolden(t, strings.Join(t2, "\n"), strings.Join(t1, "\n"))
+	}
+}
+
+func TestSplitVoteIsResolved(t *testing.T) {
+	n := New(Config{Replicas: []uint64{1, 2, 3, 4}, Seed: 1})
+	// 1 and 2 campaign in the same term before any vote is delivered, 3 only
+	// receives the request from 1 and 4 only receives the request from 2
+	n.DropNext(And(MessageType(pb.RequestVote), Between(1, 4)))
+	n.DropNext(And(MessageType(pb.RequestVote), Between(2, 3)))
+	for _, id := range []uint64{1, 2} {
+		for n.Node(id).Status().State == "Follower" {
+			if err := n.TickNode(id, 1); err != nil {
+				t.Fatalf("failed to tick %v", err)
+			}
+		}
+	}
+	n.DeliverAll()
+	if leaderID := n.Leader(); leaderID != 0 {
+		t.Fatalf("unexpected leader %d", leaderID)
+	}
+	n.CheckState(t, `
+		1 Candidate term=2 vote=1 leader=0 commit=4 applied=4 log=[1,4] data=
+		2 Candidate term=2 vote=2 leader=0 commit=4 applied=4 log=[1,4] data=
+		3 Follower term=2 vote=1 leader=0 commit=4 applied=4 log=[1,4] data=
+		4 Follower term=2 vote=2 leader=0 commit=4 applied=4 log=[1,4] data=
+	`)
+	advanceUntilLeader(t, n, n.IDs()...)
+	if err := n.Commit("a"); err != nil {
+		t.Fatalf("failed to commit %v", err)
+	}
+	n.CheckSafety(t)
+}
+
+func TestPartitionedLeaderIsReplaced(t *testing.T) {
+	n := newTestNetwork(t, Config{Seed: 1, CheckQuorum: true})
+	n.Isolate(1)
+	// never committed as the leader is partitioned
+	if err := n.Propose(1, "lost"); err != nil {
+		t.Fatalf("failed to propose %v", err)
+	}
+	leaderID := advanceUntilLeader(t, n, 2, 3)
+	if err := n.Commit("b"); err != nil {
+		t.Fatalf("failed to commit %v", err)
+	}
+	n.Advance(10)
+	// the partitioned leader stepped down once it noticed the missing quorum
+	if st := n.Node(1).Status(); st.State != "Follower" {
+		t.Errorf("partitioned leader didn't step down, %s", st.State)
+	}
+	n.Heal()
+	n.Advance(5)
+	if n.Leader() != leaderID {
+		t.Fatalf("leader changed to %d", n.Leader())
+	}
+	n.CheckState(t, `
+		1 Follower term=3 vote=0 leader=2 commit=7 applied=7 log=[1,7] data=a,b
+		2 Leader term=3 vote=2 leader=2 commit=7 applied=7 log=[1,7] data=a,b
+		3 Follower term=3 vote=2 leader=2 commit=7 applied=7 log=[1,7] data=a,b
+	`)
+	n.CheckSafety(t)
+}
+
+func TestPreVoteKeepsPartitionedFollowerTerm(t *testing.T) {
+	n := newTestNetwork(t, Config{Seed: 1, CheckQuorum: true, PreVote: true})
+	n.Isolate(3)
+	n.Advance(50)
+	if err := n.Commit("b"); err != nil {
+		t.Fatalf("failed to commit %v", err)
+	}
+	n.Heal()
+	n.Advance(5)
+	// the partitioned follower never increased its term, the leader is not
+	// disrupted once the partition is healed
+	n.CheckState(t, `
+		1 Leader term=2 vote=1 leader=1 commit=6 applied=6 log=[1,6] data=a,b
+		2 Follower term=2 vote=1 leader=1 commit=6 applied=6 log=[1,6] data=a,b
+		3 Follower term=2 vote=1 leader=1 commit=6 applied=6 log=[1,6] data=a,b
+	`)
+}
+
+func TestDroppedReplicateIsRetransmitted(t *testing.T) {
+	n := newTestNetwork(t, Config{Seed: 1})
+	n.DropNext(And(MessageType(pb.Replicate), Between(1, 2)))
+	if err := n.Commit("b"); err != nil {
+		t.Fatalf("failed to commit %v", err)
+	}
+	// 2 rejected the next Replicate message with the commit index as it
+	// doesn't have the dropped entry, the entry is then sent again
+	trace := n.Trace()
+	for len(trace) > 0 && !strings.HasPrefix(trace[0], "drop") {
+		trace = trace[1:]
+	}
+	CheckGolden(t, strings.Join(trace, "\n"), `
+		drop 1->2 Replicate term=2 index=5 logterm=2 entries=1 commit=5
+		1->3 Replicate term=2 index=5 logterm=2 entries=1 commit=5
+		3->1 ReplicateResp term=2 index=6 reject=false
+		1->2 Replicate term=2 index=6 logterm=2 entries=0 commit=6
+		1->3 Replicate term=2 index=6 logterm=2 entries=0 commit=6
+		2->1 ReplicateResp term=2 index=6 reject=true
+		3->1 ReplicateResp term=2 index=6 reject=false
+		1->2 Replicate term=2 index=5 logterm=2 entries=1 commit=6
+		2->1 ReplicateResp term=2 index=6 reject=false
+		1->2 Replicate term=2 index=6 logterm=2 entries=0 commit=6
+		2->1 ReplicateResp term=2 index=6 reject=false
+	`)
+	n.Advance(2)
+	n.CheckState(t, `
+		1 Leader term=2 vote=1 leader=1 commit=6 applied=6 log=[1,6] data=a,b
+		2 Follower term=2 vote=1 leader=1 commit=6 applied=6 log=[1,6] data=a,b
+		3 Follower term=2 vote=1 leader=1 commit=6 applied=6 log=[1,6] data=a,b
+	`)
+}
+
+func hasMessage(n *Network, prefix string) bool {
+	for _, m := range n.Trace() {
+		if strings.HasPrefix(m, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLaggingFollowerCatchesUpFromSnapshot(t *testing.T) {
+	n := newTestNetwork(t, Config{Seed: 1})
+	if err := n.Stop(3); err != nil {
+		t.Fatalf("failed to stop %v", err)
+	}
+	if err := n.Commit("b", "c", "d"); err != nil {
+		t.Fatalf("failed to commit %v", err)
+	}
+	index, err := n.CreateSnapshot(1)
+	if err != nil {
+		t.Fatalf("failed to create snapshot %v", err)
+	}
+	if err := n.Restart(3); err != nil {
+		t.Fatalf("failed to restart %v", err)
+	}
+	n.Advance(3)
+	if !hasMessage(n, "1->3 InstallSnapshot") {
+		t.Errorf("snapshot not sent")
+	}
+	if ss := n.Node(3).Snapshot(); ss.Index != index {
+		t.Errorf("snapshot index %d, want %d", ss.Index, index)
+	}
+	n.CheckState(t, `
+		1 Leader term=2 vote=1 leader=1 commit=8 applied=8 log=[9,8] data=a,b,c,d
+		2 Follower term=2 vote=1 leader=1 commit=8 applied=8 log=[1,8] data=a,b,c,d
+		3 Follower term=2 vote=1 leader=1 commit=8 applied=8 log=[9,8] data=a,b,c,d
+	`)
+	n.CheckSafety(t)
+}
+
+func TestAddedReplicaCatchesUpFromSnapshotWithItsMembership(t *testing.T) {
+	n := newTestNetwork(t, Config{Seed: 1})
+	n.AddNode(4)
+	// the snapshot is taken after the config change is committed but before
+	// the new replica received anything from the leader
+	n.Partition(1, 4)
+	if err := n.ProposeConfigChange(1,
+		pb.ConfigChange{Type: pb.AddNode, ReplicaID: 4}); err != nil {
+		t.Fatalf("failed to propose config change %v", err)
+	}
+	n.DeliverAll()
+	if _, ok := n.Node(1).Membership().Addresses[4]; !ok {
+		t.Fatalf("config change not applied")
+	}
+	if _, err := n.CreateSnapshot(1); err != nil {
+		t.Fatalf("failed to create snapshot %v", err)
+	}
+	n.Heal()
+	n.Advance(3)
+	if err := n.Commit("b"); err != nil {
+		t.Fatalf("failed to commit %v", err)
+	}
+	if _, ok := n.Node(4).Membership().Addresses[4]; !ok {
+		t.Errorf("membership not restored from snapshot")
+	}
+	n.CheckState(t, `
+		1 Leader term=2 vote=1 leader=1 commit=7 applied=7 log=[7,7] data=a,b
+		2 Follower term=2 vote=1 leader=1 commit=7 applied=7 log=[1,7] data=a,b
+		3 Follower term=2 vote=1 leader=1 commit=7 applied=7 log=[1,7] data=a,b
+		4 Follower term=2 vote=0 leader=1 commit=7 applied=7 log=[7,7] data=a,b
+	`)
+	// the new replica is a voting member, the shard can lose two of its
+	// original members after a leader change
+	if err := n.Stop(1); err != nil {
+		t.Fatalf("failed to stop %v", err)
+	}
+	advanceUntilLeader(t, n, 2, 3, 4)
+	if err := n.Commit("c"); err != nil {
+		t.Fatalf("failed to commit %v", err)
+	}
+	n.CheckSafety(t)
+}
+
+func TestJointConfigChangeReplacesReplica(t *testing.T) {
+	n := newTestNetwork(t, Config{Seed: 1})
+	n.AddNode(4)
+	cc := pb.ConfigChange{
+		Type: pb.EnterJoint,
+		Members: map[uint64]string{
+			1: address(1),
+			2: address(2),
+			4: address(4),
+		},
+	}
+	if err := n.ProposeConfigChange(1, cc); err != nil {
+		t.Fatalf("failed to propose config change %v", err)
+	}
+	n.Advance(5)
+	// LeaveJoint is proposed by the leader on its own, the outgoing replica is
+	// removed once it is applied
+	m := n.Node(1).Membership()
+	if len(m.Addresses) != 3 || len(m.Outgoing) != 0 || !m.Removed[3] {
+		t.Errorf("unexpected membership %+v", m)
+	}
+	if err := n.Commit("b"); err != nil {
+		t.Fatalf("failed to commit %v", err)
+	}
+	n.CheckState(t, `
+		1 Leader term=2 vote=1 leader=1 commit=8 applied=8 log=[1,8] data=a,b
+		2 Follower term=2 vote=1 leader=1 commit=8 applied=8 log=[1,8] data=a,b
+		3 Follower term=2 vote=1 leader=1 commit=7 applied=7 log=[1,7] data=a stopped
+		4 Follower term=2 vote=0 leader=1 commit=8 applied=8 log=[1,8] data=a,b
+	`)
+	n.CheckSafety(t)
+}
@@ -0,0 +1,189 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rafttest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+)
+
+// Campaign ticks the specified follower alone until its election timeout
+// fires and delivers all messages. The node is not guaranteed to become the
+// leader, e.g. when it is partitioned or its log is not up to date.
+func (n *Network) Campaign(id uint64) error {
+	node, err := n.running(id)
+	if err != nil {
+		return err
+	}
+	term := node.Status().Term
+	for i := uint64(0); ; i++ {
+		st := node.Status()
+		if st.State != "Follower" || st.Term != term {
+			break
+		}
+		if i > 2*n.cfg.ElectionRTT {
+			return errors.Errorf("node %d didn't campaign", id)
+		}
+		n.tick(node)
+	}
+	n.DeliverAll()
+	return nil
+}
+
+// ElectLeader has the specified node elected as the leader by having it
+// campaign before all other nodes.
+func (n *Network) ElectLeader(id uint64) error {
+	if err := n.Campaign(id); err != nil {
+		return err
+	}
+	if leaderID := n.Leader(); leaderID != id {
+		return errors.Errorf("node %d not elected, leader %d", id, leaderID)
+	}
+	return nil
+}
+
+// Commit proposes the specified payloads on the leader and delivers all
+// messages, it fails when the payloads are not committed.
+func (n *Network) Commit(payloads ...string) error {
+	leaderID := n.Leader()
+	if leaderID == 0 {
+		return errors.New("no leader")
+	}
+	node := n.nodes[leaderID]
+	lastIndex := node.peer.GetLastIndex()
+	if err := n.Propose(leaderID, payloads...); err != nil {
+		return err
+	}
+	n.DeliverAll()
+	if committed := node.peer.GetCommitted(); committed < lastIndex+1 {
+		return errors.Errorf("not committed, committed %d, last index %d",
+			committed, lastIndex+1)
+	}
+	return nil
+}
+
+// Describe returns a deterministic description of all nodes, one line per
+// node, to be compared with golden descriptions using CheckState.
+func (n *Network) Describe() string {
+	var lines []string
+	for _, id := range n.IDs() {
+		node := n.nodes[id]
+		st := node.Status()
+		line := fmt.Sprintf("%d %s term=%d vote=%d leader=%d commit=%d "+
+			"applied=%d log=[%d,%d] data=%s", id, st.State, st.Term, st.Vote,
+			st.LeaderID, st.Committed, node.applied, st.FirstIndex, st.LastIndex,
+			strings.Join(node.data, ","))
+		if node.stopped {
+			line += " stopped"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// CheckState fails the test when the description of the nodes is not the
+// same as the golden description. Leading and trailing spaces of each line of
+// the golden description are ignored.
+func (n *Network) CheckState(t testing.TB, golden string) {
+	t.Helper()
+	CheckGolden(t, n.Describe(), golden)
+}
+
+// CheckGolden fails the test when got is not the same as the golden text,
+// leading and trailing spaces of each line and empty lines are ignored.
+func CheckGolden(t testing.TB, got string, golden string) {
+	t.Helper()
+	g, w := normalize(got), normalize(golden)
+	if len(g) == len(w) {
+		diff := false
+		for i := range g {
+			if g[i] != w[i] {
+				diff = true
+				break
+			}
+		}
+		if !diff {
+			return
+		}
+	}
+	t.Errorf("unexpected state\ngot:\n%s\nwant:\n%s",
+		strings.Join(g, "\n"), strings.Join(w, "\n"))
+}
+
+func normalize(s string) []string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// CheckSafety fails the test when the Raft safety properties are violated,
+// it checks that there is at most one running leader in each term, that
+// nodes agree on all entries both of them have committed and that the applied
+// payloads of each node are a prefix of those of any node applied more.
+func (n *Network) CheckSafety(t testing.TB) {
+	t.Helper()
+	leaders := make(map[uint64]uint64)
+	for _, id := range n.IDs() {
+		node := n.nodes[id]
+		st := node.Status()
+		if node.stopped || st.State != "Leader" {
+			continue
+		}
+		if other, ok := leaders[st.Term]; ok {
+			t.Errorf("node %d and %d are both leaders in term %d",
+				other, id, st.Term)
+		}
+		leaders[st.Term] = id
+	}
+	ids := n.IDs()
+	for i, a := range ids {
+		for _, b := range ids[i+1:] {
+			na, nb := n.nodes[a], n.nodes[b]
+			da, db := na.data, nb.data
+			if len(da) > len(db) {
+				da, db = db, da
+			}
+			for k := range da {
+				if da[k] != db[k] {
+					t.Errorf("node %d and %d applied different payloads", a, b)
+					break
+				}
+			}
+			committed := na.peer.GetCommitted()
+			if c := nb.peer.GetCommitted(); c < committed {
+				committed = c
+			}
+			for index := uint64(1); index <= committed; index++ {
+				ta, aerr := na.logdb.Term(index)
+				tb, berr := nb.logdb.Term(index)
+				if aerr != nil || berr != nil {
+					// compacted by a snapshot
+					continue
+				}
+				if ta != tb {
+					t.Errorf("node %d and %d disagree on committed entry %d, "+
+						"term %d vs %d", a, b, index, ta, tb)
+				}
+			}
+		}
+	}
+}
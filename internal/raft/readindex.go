@@ -76,12 +76,21 @@ func (r *readIndex) peepCtx() raftpb.SystemCtx {
 
 func (r *readIndex) confirm(ctx raftpb.SystemCtx,
 	from uint64, quorum int) []*readStatus {
+	return r.confirmWith(ctx, from, func(confirmed map[uint64]struct{}) bool {
+		return len(confirmed)+1 >= quorum
+	})
+}
+
+// confirmWith is similar to confirm, it uses the specified function to check
+// whether confirmations from remote nodes form a quorum.
+func (r *readIndex) confirmWith(ctx raftpb.SystemCtx, from uint64,
+	hasQuorum func(map[uint64]struct{}) bool) []*readStatus {
 	p, ok := r.pending[ctx]
 	if !ok {
 		return nil
 	}
 	p.confirmed[from] = struct{}{}
-	if len(p.confirmed)+1 < quorum {
+	if !hasQuorum(p.confirmed) {
 		return nil
 	}
 	done := 0
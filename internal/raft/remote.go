@@ -76,7 +76,18 @@ type remote struct {
 	snapshotIndex uint64
 	state         remoteStateType
 	active        bool
-	delayed       snapshotAck
+	// lastActive is the tick when the last response was received from the
+	// remote, it is 0 when no response has been received since the remote
+	// was reset
+	lastActive uint64
+	delayed    snapshotAck
+	// promoted is set when the remote is a promoted witness that has not been
+	// restarted as a regular node yet
+	promoted bool
+	catchup  catchupThrottle
+	// version is the protocol version advertised by the remote in its last
+	// response, it is 0 when unknown
+	version uint32
 }
 
 func (r *remote) String() string {
@@ -0,0 +1,203 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"sort"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// before appending a config change entry that removes voting members, the
+// leader checks whether the resulting configuration still has a quorum of
+// active voting members, i.e. members that responded to the leader within the
+// last election timeout. when the shard is in a joint configuration, both the
+// incoming and the outgoing configurations are checked. unsafe config change
+// entries are marked with the inactive members and they are rejected by all
+// replicas when applied. the check is skipped when the Force flag is set.
+//
+// replicas running versions that predate such marks, i.e. protocol version 0,
+// ignore them. the leader stamps its protocol version on the config change
+// when all members have advertised it, replicas only apply rules introduced
+// by later versions to stamped config changes. before that, config changes
+// that would have to be rejected by all replicas or that rely on the new
+// rules, e.g. AllowReuse, are dropped by the leader.
+
+// checkMembershipChangeSafety returns the config change entry to be appended
+// by the leader, false is returned when the config change should be dropped.
+func (r *raft) checkMembershipChangeSafety(e pb.Entry) (pb.Entry, bool) {
+	var cc pb.ConfigChange
+	if err := cc.Unmarshal(e.Cmd); err != nil {
+		return e, true
+	}
+	unsupported := r.getUnsupported(cc, getRequiredVersion(cc))
+	if len(unsupported) > 0 {
+		plog.Warningf("%s dropped %s, not supported by %v",
+			r.describe(), cc.Type, unsupported)
+		return e, false
+	}
+	inactive := r.getUnsafeInactive(cc)
+	exceeded := r.exceedsMembershipLimits(cc)
+	if unsupported = r.getUnsupported(cc, pb.ProtocolVersion); len(unsupported) > 0 {
+		if len(inactive) > 0 || exceeded || cc.AllowReuse {
+			plog.Warningf("%s dropped %s for %s, can't be handled by %v",
+				r.describe(), cc.Type, ReplicaID(cc.ReplicaID), unsupported)
+			return e, false
+		}
+		return e, true
+	}
+	cc.ProtocolVersion = pb.ProtocolVersion
+	if len(inactive) > 0 {
+		plog.Warningf("%s rejecting unsafe %s for %s, inactive %v",
+			r.describe(), cc.Type, ReplicaID(cc.ReplicaID), inactive)
+		cc.Inactive = inactive
+	}
+	if exceeded {
+		plog.Warningf("%s rejecting %s for %s, membership limit exceeded",
+			r.describe(), cc.Type, ReplicaID(cc.ReplicaID))
+		cc.LimitExceeded = true
+	}
+	if cc.Type == pb.RemoveNode || cc.Type == pb.ReplaceWitness {
+		cc.MaxRemoved = r.maxRemoved
+	}
+	e.Cmd = pb.MustMarshal(&cc)
+	return e, true
+}
+
+// getUnsafeInactive returns the inactive voting members that prevent the
+// configurations resulted from the config change to have a quorum of active
+// voting members. nil is returned when the config change is safe.
+func (r *raft) getUnsafeInactive(cc pb.ConfigChange) []uint64 {
+	if cc.Force {
+		return nil
+	}
+	var configs []map[uint64]struct{}
+	removed := NoNode
+	switch cc.Type {
+	case pb.RemoveNode:
+		if !r.isVotingMember(cc.ReplicaID) {
+			return nil
+		}
+		removed = cc.ReplicaID
+		if r.isJoint() {
+			configs = append(configs, r.joint.incoming, r.joint.outgoing)
+		} else {
+			nodes := make(map[uint64]struct{}, len(r.remotes))
+			for id := range r.remotes {
+				nodes[id] = struct{}{}
+			}
+			configs = append(configs, nodes)
+		}
+	case pb.ReplaceWitness:
+		// the number of voting members is unchanged and the replaced witness is
+		// expected to be unavailable, the change never reduces the number of
+		// active voting members
+		return nil
+	case pb.EnterJoint:
+		// nodes new to the shard are expected to be started later, they are not
+		// considered when checking the incoming configuration
+		incoming := make(map[uint64]struct{}, len(cc.Members))
+		for id := range cc.Members {
+			if r.isVotingMember(id) || r.isNonVotingMember(id) {
+				incoming[id] = struct{}{}
+			}
+		}
+		removing := false
+		for id := range r.remotes {
+			if _, ok := incoming[id]; !ok {
+				removing = true
+			}
+		}
+		if !removing {
+			return nil
+		}
+		configs = append(configs, incoming)
+	default:
+		return nil
+	}
+	inactive := make(map[uint64]struct{})
+	for _, nodes := range configs {
+		r.checkActiveQuorum(nodes, removed, inactive)
+	}
+	if len(inactive) == 0 {
+		return nil
+	}
+	result := make([]uint64, 0, len(inactive))
+	for id := range inactive {
+		result = append(result, id)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// checkActiveQuorum checks whether the specified configuration, together with
+// witnesses, has a quorum of active voting members once the removed member is
+// excluded. inactive members are added to the inactive map when the quorum is
+// not available.
+func (r *raft) checkActiveQuorum(nodes map[uint64]struct{},
+	removed uint64, inactive map[uint64]struct{}) {
+	voters := make([]uint64, 0, len(nodes)+len(r.witnesses))
+	for id := range nodes {
+		if id != removed {
+			voters = append(voters, id)
+		}
+	}
+	for id := range r.witnesses {
+		if id != removed {
+			voters = append(voters, id)
+		}
+	}
+	var notActive []uint64
+	for _, id := range voters {
+		if !r.isRecentlyActive(id) {
+			notActive = append(notActive, id)
+		}
+	}
+	if len(voters)-len(notActive) < len(voters)/2+1 {
+		for _, id := range notActive {
+			inactive[id] = struct{}{}
+		}
+	}
+}
+
+func (r *raft) isNonVotingMember(replicaID uint64) bool {
+	_, ok := r.nonVotings[replicaID]
+	return ok
+}
+
+func (r *raft) isVotingMember(replicaID uint64) bool {
+	if _, ok := r.remotes[replicaID]; ok {
+		return true
+	}
+	_, ok := r.witnesses[replicaID]
+	return ok
+}
+
+// isRecentlyActive returns a boolean value indicating whether the specified
+// member responded to the leader within the last election timeout.
+func (r *raft) isRecentlyActive(replicaID uint64) bool {
+	if replicaID == r.replicaID {
+		return true
+	}
+	rp, ok := r.remotes[replicaID]
+	if !ok {
+		if rp, ok = r.witnesses[replicaID]; !ok {
+			if rp, ok = r.nonVotings[replicaID]; !ok {
+				return false
+			}
+		}
+	}
+	return rp.lastActive > 0 && r.tickCount-rp.lastActive <= r.electionTimeout
+}
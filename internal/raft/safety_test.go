@@ -0,0 +1,126 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"reflect"
+	"testing"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func proposeTestConfigChange(t *testing.T,
+	r *raft, cc pb.ConfigChange) pb.ConfigChange {
+	r.clearPendingConfigChange()
+	setTestProtocolVersion(r, pb.ProtocolVersion)
+	e := pb.Entry{Type: pb.ConfigChangeEntry, Cmd: pb.MustMarshal(&cc)}
+	ne(r.Handle(pb.Message{From: 1, To: 1, Type: pb.Propose,
+		Entries: []pb.Entry{e}}), t)
+	ents, err := r.log.entries(r.log.lastIndex(), noLimit)
+	if err != nil {
+		t.Fatalf("failed to get entries %v", err)
+	}
+	if len(ents) != 1 || ents[0].Type != pb.ConfigChangeEntry {
+		t.Fatalf("config change entry not appended")
+	}
+	var result pb.ConfigChange
+	pb.MustUnmarshal(&result, ents[0].Cmd)
+	return result
+}
+
+func newActiveTestLeader(t *testing.T, peers []uint64) *raft {
+	r := newTestRaft(1, peers, 10, 1, NewTestLogDB())
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	ne(r.tick(), t)
+	ne(r.Handle(pb.Message{From: 2, To: 1, Type: pb.HeartbeatResp,
+		Term: r.term}), t)
+	return r
+}
+
+func TestUnsafeNodeRemovalIsMarked(t *testing.T) {
+	r := newActiveTestLeader(t, []uint64{1, 2, 3})
+	cc := proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 2})
+	if !reflect.DeepEqual(cc.Inactive, []uint64{3}) {
+		t.Errorf("unexpected inactive nodes %v", cc.Inactive)
+	}
+	cc = proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 2, Force: true})
+	if len(cc.Inactive) != 0 {
+		t.Errorf("forced removal marked as unsafe")
+	}
+	cc = proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 3})
+	if len(cc.Inactive) != 0 {
+		t.Errorf("safe removal marked as unsafe, %v", cc.Inactive)
+	}
+}
+
+func TestNodesBecomeInactiveAfterElectionTimeout(t *testing.T) {
+	r := newActiveTestLeader(t, []uint64{1, 2, 3})
+	for i := uint64(0); i <= r.electionTimeout; i++ {
+		ne(r.tick(), t)
+	}
+	cc := proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 3})
+	if !reflect.DeepEqual(cc.Inactive, []uint64{2}) {
+		t.Errorf("unexpected inactive nodes %v", cc.Inactive)
+	}
+}
+
+func TestRemovingNonVotingIsAlwaysSafe(t *testing.T) {
+	r := newActiveTestLeader(t, []uint64{1, 2, 3})
+	r.setNonVoting(4, 0, 1)
+	cc := proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 4})
+	if len(cc.Inactive) != 0 {
+		t.Errorf("nonVoting removal marked as unsafe")
+	}
+}
+
+func TestUnsafeRemovalInJointConfigIsMarked(t *testing.T) {
+	r := newActiveTestLeader(t, []uint64{1, 2, 3, 4})
+	r.joint = newJointConfig(map[uint64]string{1: "a1", 2: "a2", 4: "a4"},
+		map[uint64]string{1: "a1", 2: "a2", 3: "a3"})
+	cc := proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 2})
+	if !reflect.DeepEqual(cc.Inactive, []uint64{3, 4}) {
+		t.Errorf("unexpected inactive nodes %v", cc.Inactive)
+	}
+	cc = proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 3})
+	if len(cc.Inactive) != 0 {
+		t.Errorf("safe removal marked as unsafe, %v", cc.Inactive)
+	}
+}
+
+func TestUnsafeEnterJointIsMarked(t *testing.T) {
+	r := newActiveTestLeader(t, []uint64{1, 2, 3})
+	cc := proposeTestConfigChange(t, r, pb.ConfigChange{
+		Type:    pb.EnterJoint,
+		Members: map[uint64]string{1: "a1", 3: "a3", 4: "a4"},
+	})
+	if !reflect.DeepEqual(cc.Inactive, []uint64{3}) {
+		t.Errorf("unexpected inactive nodes %v", cc.Inactive)
+	}
+	cc = proposeTestConfigChange(t, r, pb.ConfigChange{
+		Type:    pb.EnterJoint,
+		Members: map[uint64]string{1: "a1", 2: "a2", 4: "a4"},
+	})
+	if len(cc.Inactive) != 0 {
+		t.Errorf("safe reconfiguration marked as unsafe, %v", cc.Inactive)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/server"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// staged non-voting members are recorded in the membership of the shard, the
+// leader watches their progress and proposes the AddNode config change entry
+// on its own to promote them once they caught up. the watch is restarted
+// whenever a new leader is elected.
+
+const (
+	defaultStagedPromotionMaxLag uint64 = 1000
+)
+
+type stagedNonVoting struct {
+	address  string
+	elapsed  uint64
+	timedOut bool
+}
+
+func (r *raft) setStaged(replicaID uint64, address string) {
+	plog.Infof("%s added staged nonVoting %s (%s)",
+		r.describe(), ReplicaID(replicaID), address)
+	r.staged[replicaID] = &stagedNonVoting{address: address}
+}
+
+// restoreStaged restores staged non-voting members from the membership
+// recorded in snapshots or LogDB.
+func (r *raft) restoreStaged(m pb.Membership) {
+	r.staged = make(map[uint64]*stagedNonVoting)
+	for id := range m.Staged {
+		if addr, ok := m.NonVotings[id]; ok {
+			r.staged[id] = &stagedNonVoting{address: addr}
+		}
+	}
+}
+
+func (r *raft) resetStaged() {
+	for _, s := range r.staged {
+		s.elapsed = 0
+		s.timedOut = false
+	}
+}
+
+// stagedCaughtUp returns a boolean value indicating whether the staged
+// non-voting member with the specified match index can be promoted.
+func (r *raft) stagedCaughtUp(match uint64) (bool, error) {
+	lastIndex := r.log.lastIndex()
+	if match >= lastIndex {
+		return true, nil
+	}
+	if lastIndex-match > r.stagedMaxLag {
+		return false, nil
+	}
+	if r.stagedMaxLagBytes == 0 {
+		return true, nil
+	}
+	ents, err := r.log.entries(match+1, r.stagedMaxLagBytes)
+	if err != nil {
+		if errors.Is(err, ErrCompacted) {
+			return false, nil
+		}
+		return false, err
+	}
+	// entries are size limited by the returned result
+	return len(ents) > 0 && ents[len(ents)-1].Index == lastIndex, nil
+}
+
+// checkStaged is called by the leader on each tick to promote caught up staged
+// non-voting members.
+func (r *raft) checkStaged() error {
+	// the leader might have stepped down when checking quorum
+	if !r.isLeader() {
+		return nil
+	}
+	for id, s := range r.staged {
+		if s.timedOut {
+			continue
+		}
+		s.elapsed++
+		rp, ok := r.nonVotings[id]
+		if !ok {
+			continue
+		}
+		if r.stagedTimeout > 0 && s.elapsed > r.stagedTimeout {
+			s.timedOut = true
+			plog.Warningf("%s staged nonVoting %s not promoted in time, match %d",
+				r.describe(), ReplicaID(id), rp.match)
+			if r.events != nil {
+				r.events.StagedPromotionTimeout(server.StagedPromotionInfo{
+					ShardID:         r.shardID,
+					ReplicaID:       r.replicaID,
+					StagedReplicaID: id,
+					Match:           rp.match,
+				})
+			}
+			continue
+		}
+		if r.hasPendingConfigChange() || r.isJoint() || r.leaderTransfering() {
+			continue
+		}
+		ok, err := r.stagedCaughtUp(rp.match)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return r.proposeStagedPromotion(id, s.address)
+		}
+	}
+	return nil
+}
+
+// proposeStagedPromotion makes the leader propose the AddNode config change
+// entry for promoting the specified staged non-voting member.
+func (r *raft) proposeStagedPromotion(replicaID uint64, address string) error {
+	r.mustBeLeader()
+	cc := pb.ConfigChange{
+		Type:      pb.AddNode,
+		ReplicaID: replicaID,
+		Address:   address,
+		Staged:    true,
+	}
+	entry := pb.Entry{Type: pb.ConfigChangeEntry, Cmd: pb.MustMarshal(&cc)}
+	r.setPendingConfigChange()
+	plog.Infof("%s proposing to promote staged nonVoting %s",
+		r.describe(), ReplicaID(replicaID))
+	if err := r.appendEntries([]pb.Entry{entry}); err != nil {
+		return err
+	}
+	r.broadcastReplicateMessage()
+	return nil
+}
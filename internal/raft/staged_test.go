@@ -0,0 +1,186 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"testing"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func getStagedPromotionEntries(t *testing.T, r *raft) []pb.Entry {
+	ents, err := r.log.entries(r.log.firstIndex(), noLimit)
+	if err != nil {
+		t.Fatalf("failed to get entries %v", err)
+	}
+	result := make([]pb.Entry, 0)
+	for _, e := range ents {
+		if e.Type != pb.ConfigChangeEntry {
+			continue
+		}
+		var cc pb.ConfigChange
+		pb.MustUnmarshal(&cc, e.Cmd)
+		if cc.Type == pb.AddNode && cc.Staged {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func TestStagedNonVotingIsPromotedOnceCaughtUp(t *testing.T) {
+	r := newTestRaft(1, []uint64{1}, 10, 1, NewTestLogDB())
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	r.setNonVoting(2, 0, 1)
+	r.setStaged(2, "a2")
+	r.stagedMaxLag = 0
+	ne(r.tick(), t)
+	if len(getStagedPromotionEntries(t, r)) != 0 {
+		t.Fatalf("unexpected promotion")
+	}
+	r.nonVotings[2].match = r.log.lastIndex()
+	ne(r.tick(), t)
+	ents := getStagedPromotionEntries(t, r)
+	if len(ents) != 1 {
+		t.Fatalf("staged nonVoting not promoted")
+	}
+	var cc pb.ConfigChange
+	pb.MustUnmarshal(&cc, ents[0].Cmd)
+	if cc.ReplicaID != 2 || cc.Address != "a2" {
+		t.Errorf("unexpected config change %+v", cc)
+	}
+	if !r.hasPendingConfigChange() {
+		t.Errorf("pending config change not set")
+	}
+	r.addNode(2)
+	if _, ok := r.staged[2]; ok {
+		t.Errorf("promoted node still staged")
+	}
+}
+
+func TestStagedCaughtUp(t *testing.T) {
+	r := newTestRaft(1, []uint64{1}, 10, 1, NewTestLogDB())
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	data := make([]byte, 100)
+	for i := 0; i < 10; i++ {
+		ne(r.appendEntries([]pb.Entry{{Cmd: data}}), t)
+	}
+	last := r.log.lastIndex()
+	tests := []struct {
+		maxLag      uint64
+		maxLagBytes uint64
+		match       uint64
+		caughtUp    bool
+	}{
+		{0, 0, last, true},
+		{0, 0, last - 1, false},
+		{5, 0, last - 5, true},
+		{5, 0, last - 6, false},
+		{5, 2000, last - 5, true},
+		{5, 500, last - 5, false},
+	}
+	for idx, tt := range tests {
+		r.stagedMaxLag = tt.maxLag
+		r.stagedMaxLagBytes = tt.maxLagBytes
+		caughtUp, err := r.stagedCaughtUp(tt.match)
+		ne(err, t)
+		if caughtUp != tt.caughtUp {
+			t.Errorf("%d, caught up %t, want %t", idx, caughtUp, tt.caughtUp)
+		}
+	}
+}
+
+func TestStagedPromotionCanTimeout(t *testing.T) {
+	r := newTestRaft(1, []uint64{1}, 10, 1, NewTestLogDB())
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	r.setNonVoting(2, 0, 1)
+	r.setStaged(2, "a2")
+	r.stagedMaxLag = 0
+	r.stagedTimeout = 5
+	for i := 0; i < 6; i++ {
+		ne(r.tick(), t)
+	}
+	if !r.staged[2].timedOut {
+		t.Fatalf("not timed out")
+	}
+	r.nonVotings[2].match = r.log.lastIndex()
+	ne(r.tick(), t)
+	if len(getStagedPromotionEntries(t, r)) != 0 {
+		t.Errorf("unexpected promotion after timeout")
+	}
+	// the watch is restarted when leader changes
+	r.reset(r.term+1, true)
+	if r.staged[2].timedOut || r.staged[2].elapsed != 0 {
+		t.Errorf("staged nonVoting not reset")
+	}
+}
+
+func TestStagedPromotionCompletesAcrossLeaderTransfer(t *testing.T) {
+	peers := make(map[uint64]stateMachine)
+	rafts := make(map[uint64]*raft)
+	for id := uint64(1); id <= 3; id++ {
+		r := newTestRaft(id, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+		r.setNonVoting(4, 0, 1)
+		r.setStaged(4, "a4")
+		r.stagedMaxLag = 0
+		peers[id] = r
+		rafts[id] = r
+	}
+	nv := newTestNonVoting(4, []uint64{1, 2, 3}, []uint64{4}, 10, 1, NewTestLogDB())
+	peers[4] = nv
+	rafts[4] = nv
+	nw := &network{
+		peers:   peers,
+		dropm:   make(map[connem]float64),
+		ignorem: make(map[pb.MessageType]bool),
+	}
+	nw.isolate(4)
+	nw.send(pb.Message{From: 1, To: 1, Type: pb.Election})
+	if !rafts[1].isLeader() {
+		t.Fatalf("node 1 is not the leader")
+	}
+	for i := 0; i < 5; i++ {
+		ne(rafts[1].tick(), t)
+		nw.send(rafts[1].readMessages()...)
+	}
+	if len(getStagedPromotionEntries(t, rafts[1])) != 0 {
+		t.Fatalf("unexpected promotion")
+	}
+	nw.send(pb.Message{From: 2, To: 1, Hint: 2, Type: pb.LeaderTransfer})
+	r := rafts[2]
+	if !r.isLeader() {
+		t.Fatalf("node 2 is not the leader")
+	}
+	nw.recover()
+	for i := 0; i < 20; i++ {
+		ne(r.tick(), t)
+		nw.send(r.readMessages()...)
+		if len(getStagedPromotionEntries(t, r)) > 0 {
+			break
+		}
+	}
+	ents := getStagedPromotionEntries(t, r)
+	if len(ents) != 1 {
+		t.Fatalf("staged nonVoting not promoted by the new leader")
+	}
+	nw.send(r.readMessages()...)
+	for id := uint64(1); id <= 4; id++ {
+		if rafts[id].log.committed < ents[0].Index {
+			t.Errorf("promotion not committed on node %d", id)
+		}
+	}
+}
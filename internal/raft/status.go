@@ -0,0 +1,78 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"sort"
+
+	"github.com/lni/dragonboat/v4/internal/server"
+)
+
+const (
+	votingRemote    = "Voting"
+	nonVotingRemote = "NonVoting"
+	witnessRemote   = "Witness"
+)
+
+func (r *raft) getStatus() server.RaftStatus {
+	st := server.RaftStatus{
+		State:                r.state.String(),
+		Term:                 r.term,
+		Vote:                 r.vote,
+		LeaderID:             r.leaderID,
+		Committed:            r.log.committed,
+		Processed:            r.log.processed,
+		Applied:              r.applied,
+		FirstIndex:           r.log.firstIndex(),
+		LastIndex:            r.log.lastIndex(),
+		InMemEntries:         uint64(len(r.log.inmem.entries)),
+		InMemBytes:           getEntrySliceInMemSize(r.log.inmem.entries),
+		InMemRetention:       r.getInMemRetention(),
+		PendingReadIndexes:   uint64(len(r.readIndex.queue)),
+		LeaderTransferTarget: r.leaderTransferTarget,
+		TickCount:            r.tickCount,
+		ElectionTick:         r.electionTick,
+		HeartbeatTick:        r.heartbeatTick,
+		ElectionTimeout:      r.randomizedElectionTimeout,
+		PendingConfigChange:  r.pendingConfigChange,
+	}
+	if r.isLeader() {
+		add := func(remotes map[uint64]*remote, t string) {
+			for id, rp := range remotes {
+				if id == r.replicaID {
+					continue
+				}
+				st.Remotes = append(st.Remotes, server.RemoteStatus{
+					Type:          t,
+					State:         rp.state.String(),
+					ReplicaID:     id,
+					Match:         rp.match,
+					Next:          rp.next,
+					SnapshotIndex: rp.snapshotIndex,
+					LastActive:    rp.lastActive,
+					Active:        rp.isActive(),
+					Throttled:     rp.catchup.throttled,
+				})
+			}
+		}
+		add(r.remotes, votingRemote)
+		add(r.nonVotings, nonVotingRemote)
+		add(r.witnesses, witnessRemote)
+		sort.Slice(st.Remotes, func(i, j int) bool {
+			return st.Remotes[i].ReplicaID < st.Remotes[j].ReplicaID
+		})
+	}
+	return st
+}
@@ -0,0 +1,57 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"testing"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func TestFollowerStatusHasNoRemotes(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, NewTestLogDB())
+	st := r.getStatus()
+	if st.State != "Follower" || len(st.Remotes) != 0 {
+		t.Errorf("unexpected status %+v", st)
+	}
+}
+
+func TestLeaderStatusIncludesRemotes(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, NewTestLogDB())
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	r.setNonVoting(4, 0, 1)
+	r.setWitness(3, 0, 1)
+	ne(r.appendEntries([]pb.Entry{{Cmd: []byte("test-data")}}), t)
+	st := r.getStatus()
+	if st.State != "Leader" || st.LeaderID != 1 || st.Vote != 1 || st.Term != 1 {
+		t.Errorf("unexpected status %+v", st)
+	}
+	if st.LastIndex != 2 || st.InMemEntries != 2 || st.InMemBytes == 0 {
+		t.Errorf("unexpected log status %+v", st)
+	}
+	expected := []struct {
+		replicaID uint64
+		t         string
+	}{{2, votingRemote}, {3, witnessRemote}, {4, nonVotingRemote}}
+	if len(st.Remotes) != len(expected) {
+		t.Fatalf("unexpected remotes %+v", st.Remotes)
+	}
+	for idx, e := range expected {
+		if st.Remotes[idx].ReplicaID != e.replicaID || st.Remotes[idx].Type != e.t {
+			t.Errorf("unexpected remote %+v", st.Remotes[idx])
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"sort"
+	"time"
+
+	"github.com/lni/dragonboat/v4/internal/server"
+)
+
+const (
+	// durationBucketCount is the number of buckets of durationHistogram, the
+	// upper bound of bucket i is minDurationBucket * 2^i.
+	durationBucketCount = 24
+	minDurationBucket   = 100 * time.Microsecond
+	// rttAlpha and rttBeta are the gains used for the smoothed RTT and its
+	// variance, they are the values suggested by RFC 6298.
+	rttAlpha = 0.125
+	rttBeta  = 0.25
+)
+
+// durationHistogram is a histogram of durations with exponentially growing
+// buckets, it doesn't store individual samples.
+type durationHistogram struct {
+	counts [durationBucketCount]uint64
+	count  uint64
+	max    time.Duration
+}
+
+func (h *durationHistogram) observe(d time.Duration) {
+	idx := 0
+	for bound := minDurationBucket; d > bound &&
+		idx < durationBucketCount-1; bound *= 2 {
+		idx++
+	}
+	h.counts[idx]++
+	h.count++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// quantile returns the upper bound of the bucket containing the q quantile,
+// it is capped by the max observed duration.
+func (h *durationHistogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	target := uint64(q*float64(h.count) + 0.5)
+	if target == 0 {
+		target = 1
+	}
+	seen := uint64(0)
+	bound := minDurationBucket
+	for idx := 0; idx < durationBucketCount; idx++ {
+		seen += h.counts[idx]
+		if seen >= target {
+			break
+		}
+		bound *= 2
+	}
+	if bound > h.max {
+		return h.max
+	}
+	return bound
+}
+
+// heartbeatStats tracks the heartbeat round-trip time of a remote replica.
+type heartbeatStats struct {
+	sentAt  time.Time
+	rtt     time.Duration
+	rttVar  time.Duration
+	samples uint64
+	missed  uint64
+}
+
+func (s *heartbeatStats) sent(now time.Time) {
+	if !s.sentAt.IsZero() {
+		s.missed++
+	}
+	s.sentAt = now
+}
+
+func (s *heartbeatStats) responded(now time.Time) (time.Duration, bool) {
+	if s.sentAt.IsZero() {
+		return 0, false
+	}
+	sample := now.Sub(s.sentAt)
+	s.sentAt = time.Time{}
+	if s.samples == 0 {
+		s.rtt = sample
+		s.rttVar = sample / 2
+	} else {
+		diff := s.rtt - sample
+		if diff < 0 {
+			diff = -diff
+		}
+		s.rttVar = time.Duration((1-rttBeta)*float64(s.rttVar) + rttBeta*float64(diff))
+		s.rtt = time.Duration((1-rttAlpha)*float64(s.rtt) + rttAlpha*float64(sample))
+	}
+	s.samples++
+	return sample, true
+}
+
+// electionStats contains the election and heartbeat timing statistics of the
+// local replica. Heartbeat round trips are only tracked for heartbeats without
+// ReadIndex context, their responses can be matched to the most recent
+// heartbeat sent to the remote.
+type electionStats struct {
+	heartbeats        map[uint64]*heartbeatStats
+	leaderlessSince   time.Time
+	heartbeatRTT      durationHistogram
+	leaderless        durationHistogram
+	started           uint64
+	won               uint64
+	lost              uint64
+	preVoteRejections uint64
+}
+
+func newElectionStats() electionStats {
+	return electionStats{heartbeats: make(map[uint64]*heartbeatStats)}
+}
+
+func (s *electionStats) getHeartbeatStats(replicaID uint64) *heartbeatStats {
+	hs, ok := s.heartbeats[replicaID]
+	if !ok {
+		hs = &heartbeatStats{}
+		s.heartbeats[replicaID] = hs
+	}
+	return hs
+}
+
+func (s *electionStats) heartbeatSent(to uint64) {
+	s.getHeartbeatStats(to).sent(time.Now())
+}
+
+func (s *electionStats) heartbeatResponded(from uint64) {
+	if hs, ok := s.heartbeats[from]; ok {
+		if sample, ok := hs.responded(time.Now()); ok {
+			s.heartbeatRTT.observe(sample)
+		}
+	}
+}
+
+// leaderUpdated tracks leaderless periods.
+func (s *electionStats) leaderUpdated(leaderID uint64) {
+	if leaderID == NoLeader {
+		if s.leaderlessSince.IsZero() {
+			s.leaderlessSince = time.Now()
+		}
+		return
+	}
+	if !s.leaderlessSince.IsZero() {
+		s.leaderless.observe(time.Since(s.leaderlessSince))
+		s.leaderlessSince = time.Time{}
+	}
+}
+
+// becameLeader discards pending heartbeats sent in a previous term.
+func (s *electionStats) becameLeader() {
+	for _, hs := range s.heartbeats {
+		hs.sentAt = time.Time{}
+	}
+}
+
+func (r *raft) isMember(replicaID uint64) bool {
+	if _, ok := r.remotes[replicaID]; ok {
+		return true
+	}
+	if _, ok := r.nonVotings[replicaID]; ok {
+		return true
+	}
+	_, ok := r.witnesses[replicaID]
+	return ok
+}
+
+func (r *raft) getElectionStats() server.ElectionStats {
+	s := &r.electionStats
+	st := server.ElectionStats{
+		ShardID:           r.shardID,
+		ReplicaID:         r.replicaID,
+		ElectionsStarted:  s.started,
+		ElectionsWon:      s.won,
+		ElectionsLost:     s.lost,
+		PreVoteRejections: s.preVoteRejections,
+		HeartbeatRTTP99:   s.heartbeatRTT.quantile(0.99),
+		LeaderlessPeriods: s.leaderless.count,
+		LeaderlessP50:     s.leaderless.quantile(0.5),
+		LeaderlessP99:     s.leaderless.quantile(0.99),
+		LeaderlessMax:     s.leaderless.max,
+	}
+	if !s.leaderlessSince.IsZero() {
+		st.Leaderless = time.Since(s.leaderlessSince)
+	}
+	if r.isLeader() {
+		for replicaID, hs := range s.heartbeats {
+			if !r.isMember(replicaID) {
+				delete(s.heartbeats, replicaID)
+				continue
+			}
+			st.Peers = append(st.Peers, server.HeartbeatStats{
+				ReplicaID:   replicaID,
+				RTT:         hs.rtt,
+				RTTVariance: hs.rttVar,
+				Samples:     hs.samples,
+				Missed:      hs.missed,
+			})
+		}
+		sort.Slice(st.Peers, func(i, j int) bool {
+			return st.Peers[i].ReplicaID < st.Peers[j].ReplicaID
+		})
+	}
+	return st
+}
@@ -0,0 +1,131 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func TestDurationHistogramQuantile(t *testing.T) {
+	h := durationHistogram{}
+	if v := h.quantile(0.99); v != 0 {
+		t.Errorf("quantile of empty histogram %s, want 0", v)
+	}
+	for i := 0; i < 99; i++ {
+		h.observe(50 * time.Microsecond)
+	}
+	h.observe(30 * time.Millisecond)
+	if v := h.quantile(0.5); v != minDurationBucket {
+		t.Errorf("p50 %s, want %s", v, minDurationBucket)
+	}
+	if v := h.quantile(0.99); v != minDurationBucket {
+		t.Errorf("p99 %s, want %s", v, minDurationBucket)
+	}
+	if v := h.quantile(1); v != 30*time.Millisecond {
+		t.Errorf("max %s, want %s", v, 30*time.Millisecond)
+	}
+	if h.count != 100 || h.max != 30*time.Millisecond {
+		t.Errorf("count %d, max %s", h.count, h.max)
+	}
+}
+
+func TestHeartbeatStatsTracksRTTAndMissedHeartbeats(t *testing.T) {
+	s := heartbeatStats{}
+	now := time.Now()
+	if _, ok := s.responded(now); ok {
+		t.Fatalf("response without pending heartbeat accepted")
+	}
+	s.sent(now)
+	if sample, ok := s.responded(now.Add(10 * time.Millisecond)); !ok ||
+		sample != 10*time.Millisecond {
+		t.Fatalf("unexpected sample %s", sample)
+	}
+	if s.rtt != 10*time.Millisecond || s.rttVar != 5*time.Millisecond {
+		t.Errorf("rtt %s, rttVar %s", s.rtt, s.rttVar)
+	}
+	s.sent(now)
+	s.sent(now)
+	s.sent(now)
+	if s.missed != 2 {
+		t.Errorf("missed %d, want 2", s.missed)
+	}
+	s.responded(now.Add(18 * time.Millisecond))
+	if s.rtt != 11*time.Millisecond || s.samples != 2 {
+		t.Errorf("rtt %s, samples %d", s.rtt, s.samples)
+	}
+}
+
+func TestElectionStatsAreUpdatedAcrossElections(t *testing.T) {
+	a := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+	b := newTestRaft(2, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+	c := newTestRaft(3, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+	nt := newNetwork(a, b, c)
+	nt.cut(1, 3)
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.Election})
+	// 3 can't win as 2 has already voted for 1 in the same term
+	nt.send(pb.Message{From: 3, To: 3, Type: pb.Election})
+	if a.state != leader || c.state != candidate {
+		t.Fatalf("unexpected states %s, %s", a.state, c.state)
+	}
+	nt.recover()
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.LeaderHeartbeat})
+	if c.state != follower {
+		t.Fatalf("unexpected state %s", c.state)
+	}
+	as := a.getElectionStats()
+	if as.ElectionsStarted != 1 || as.ElectionsWon != 1 || as.ElectionsLost != 0 {
+		t.Errorf("unexpected stats %+v", as)
+	}
+	if as.LeaderlessPeriods != 1 || as.Leaderless != 0 {
+		t.Errorf("unexpected leaderless stats %+v", as)
+	}
+	if len(as.Peers) != 2 || as.Peers[0].ReplicaID != 2 ||
+		as.Peers[0].Samples == 0 || as.Peers[1].ReplicaID != 3 {
+		t.Errorf("unexpected peer stats %+v", as.Peers)
+	}
+	cs := c.getElectionStats()
+	if cs.ElectionsStarted != 1 || cs.ElectionsWon != 0 || cs.ElectionsLost != 1 {
+		t.Errorf("unexpected stats %+v", cs)
+	}
+	if len(cs.Peers) != 0 {
+		t.Errorf("peer stats reported by follower %+v", cs.Peers)
+	}
+	// a new election is started by 2 and won
+	nt.send(pb.Message{From: 2, To: 2, Type: pb.Election})
+	bs := b.getElectionStats()
+	if b.state != leader || bs.ElectionsStarted != 1 || bs.ElectionsWon != 1 {
+		t.Errorf("unexpected stats %+v", bs)
+	}
+}
+
+func TestPreVoteRejectionsAreCounted(t *testing.T) {
+	a := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+	b := newTestRaft(2, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+	c := newTestRaft(3, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+	a.preVote = true
+	b.preVote = true
+	c.preVote = true
+	nt := newNetwork(a, b, c)
+	nt.cut(1, 3)
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.Election})
+	nt.send(pb.Message{From: 3, To: 3, Type: pb.Election})
+	if st := c.getElectionStats(); st.PreVoteRejections != 1 ||
+		st.ElectionsStarted != 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
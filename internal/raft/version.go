@@ -0,0 +1,92 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"sort"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// all replicas advertise their pb.ProtocolVersion in their Raft messages, the
+// leader records the versions advertised by remotes in their ReplicateResp and
+// HeartbeatResp messages. config changes of types introduced by newer protocol
+// versions are dropped by the leader until all members that are going to
+// apply them have advertised support, so replicas running older versions of
+// dragonboat never see such config changes during a rolling upgrade. versions
+// are only known to the leader, they are reset when a new leader is elected.
+//
+// the leader stamps its protocol version on config changes once all members
+// have advertised it, the largest version stamped on applied config changes
+// is recorded in the membership as the shard version. all members are known
+// to support the shard version, it is not checked again so members that are
+// unavailable or not yet started don't block later config changes.
+
+// getRequiredVersion returns the protocol version required by replicas for
+// applying the config change.
+func getRequiredVersion(cc pb.ConfigChange) uint32 {
+	switch cc.Type {
+	case pb.EnterJoint, pb.LeaveJoint, pb.PromoteWitness,
+		pb.UpdateAddress, pb.ReplaceWitness:
+		return 1
+	}
+	return 0
+}
+
+// getUnsupported returns the members that have not advertised the specified
+// protocol version, nil is returned when all members that are going to apply
+// the config change support it. members the config change removes or moves to
+// a new address are expected to be unavailable, they are not required to have
+// advertised the version.
+func (r *raft) getUnsupported(cc pb.ConfigChange, version uint32) []uint64 {
+	if version <= r.shardVersion {
+		return nil
+	}
+	var result []uint64
+	for _, remotes := range []map[uint64]*remote{r.remotes,
+		r.nonVotings, r.witnesses} {
+		for id, rp := range remotes {
+			if id == r.replicaID || rp.version >= version || isExempted(cc, id) {
+				continue
+			}
+			result = append(result, id)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+func isExempted(cc pb.ConfigChange, replicaID uint64) bool {
+	switch cc.Type {
+	case pb.RemoveNode:
+		return cc.ReplicaID == replicaID
+	case pb.EnterJoint:
+		_, ok := cc.Members[replicaID]
+		return !ok
+	case pb.UpdateAddress:
+		return cc.ReplicaID == replicaID
+	case pb.ReplaceWitness:
+		return cc.ReplacedID == replicaID
+	}
+	return false
+}
+
+// setShardVersion records the protocol version known to be supported by all
+// members.
+func (r *raft) setShardVersion(version uint32) {
+	if version > r.shardVersion {
+		r.shardVersion = version
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"testing"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func setTestProtocolVersion(r *raft, version uint32) {
+	for _, remotes := range []map[uint64]*remote{r.remotes,
+		r.nonVotings, r.witnesses} {
+		for _, rp := range remotes {
+			rp.version = version
+		}
+	}
+}
+
+func proposeVersionTestConfigChange(t *testing.T,
+	r *raft, cc pb.ConfigChange) bool {
+	r.clearPendingConfigChange()
+	r.droppedEntries = nil
+	e := pb.Entry{Type: pb.ConfigChangeEntry, Cmd: pb.MustMarshal(&cc)}
+	ne(r.Handle(pb.Message{From: 1, To: 1, Type: pb.Propose,
+		Entries: []pb.Entry{e}}), t)
+	ents, err := r.log.entries(r.log.lastIndex(), noLimit)
+	if err != nil {
+		t.Fatalf("failed to get entries %v", err)
+	}
+	appended := len(ents) == 1 && ents[0].Type == pb.ConfigChangeEntry
+	if appended == (len(r.droppedEntries) > 0) {
+		t.Fatalf("unexpected dropped entries %v", r.droppedEntries)
+	}
+	if !appended && r.hasPendingConfigChange() {
+		t.Fatalf("pending config change flag set for dropped config change")
+	}
+	return appended
+}
+
+func TestProtocolVersionIsRecordedFromResponses(t *testing.T) {
+	r := newActiveTestLeader(t, []uint64{1, 2, 3})
+	if r.remotes[2].version != 0 {
+		t.Errorf("unexpected version %d", r.remotes[2].version)
+	}
+	ne(r.Handle(pb.Message{From: 2, To: 1, Type: pb.HeartbeatResp,
+		Term: r.term, ProtocolVersion: pb.ProtocolVersion}), t)
+	ne(r.Handle(pb.Message{From: 3, To: 1, Type: pb.ReplicateResp,
+		Term: r.term, LogIndex: r.log.lastIndex(),
+		ProtocolVersion: pb.ProtocolVersion}), t)
+	if r.remotes[2].version != pb.ProtocolVersion ||
+		r.remotes[3].version != pb.ProtocolVersion {
+		t.Errorf("version not recorded")
+	}
+	// a downgraded remote advertises its older version
+	ne(r.Handle(pb.Message{From: 2, To: 1, Type: pb.HeartbeatResp,
+		Term: r.term}), t)
+	if r.remotes[2].version != 0 {
+		t.Errorf("version not updated")
+	}
+}
+
+func TestConfigChangeRequiringNewerVersionIsDropped(t *testing.T) {
+	r := newActiveTestLeader(t, []uint64{1, 2, 3})
+	tests := []pb.ConfigChange{
+		{Type: pb.EnterJoint, Members: map[uint64]string{1: "a1", 2: "a2"}},
+		{Type: pb.PromoteWitness, ReplicaID: 2},
+		{Type: pb.UpdateAddress, ReplicaID: 3, Address: "a3"},
+		{Type: pb.ReplaceWitness, ReplicaID: 4, ReplacedID: 3},
+	}
+	for idx, cc := range tests {
+		setTestProtocolVersion(r, 0)
+		if proposeVersionTestConfigChange(t, r, cc) {
+			t.Errorf("%d, %s not dropped", idx, cc.Type)
+		}
+		setTestProtocolVersion(r, pb.ProtocolVersion)
+		if !proposeVersionTestConfigChange(t, r, cc) {
+			t.Errorf("%d, %s dropped", idx, cc.Type)
+		}
+	}
+	setTestProtocolVersion(r, 0)
+	for _, cc := range []pb.ConfigChange{
+		{Type: pb.AddNode, ReplicaID: 4, Address: "a4"},
+		{Type: pb.AddNonVoting, ReplicaID: 4, Address: "a4"},
+		{Type: pb.AddWitness, ReplicaID: 4, Address: "a4"},
+		{Type: pb.RemoveNode, ReplicaID: 3, Force: true},
+	} {
+		if !proposeVersionTestConfigChange(t, r, cc) {
+			t.Errorf("%s dropped", cc.Type)
+		}
+	}
+}
+
+func TestUnavailableMembersAreNotRequiredToSupportConfigChange(t *testing.T) {
+	r := newActiveTestLeader(t, []uint64{1, 2, 3})
+	r.remotes[2].version = pb.ProtocolVersion
+	// replica 3 is removed, moved to a new address or replaced
+	tests := []pb.ConfigChange{
+		{Type: pb.EnterJoint, Members: map[uint64]string{1: "a1", 2: "a2", 4: "a4"}},
+		{Type: pb.UpdateAddress, ReplicaID: 3, Address: "a3"},
+		{Type: pb.ReplaceWitness, ReplicaID: 4, ReplacedID: 3},
+	}
+	for idx, cc := range tests {
+		if !proposeVersionTestConfigChange(t, r, cc) {
+			t.Errorf("%d, %s dropped", idx, cc.Type)
+		}
+	}
+	cc := pb.ConfigChange{Type: pb.UpdateAddress, ReplicaID: 2, Address: "a2"}
+	if proposeVersionTestConfigChange(t, r, cc) {
+		t.Errorf("%s not dropped", cc.Type)
+	}
+}
+
+func TestProtocolVersionIsResetOnLeaderChange(t *testing.T) {
+	r := newActiveTestLeader(t, []uint64{1, 2, 3})
+	setTestProtocolVersion(r, pb.ProtocolVersion)
+	r.becomeFollower(r.term+1, 2)
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	cc := pb.ConfigChange{Type: pb.PromoteWitness, ReplicaID: 2}
+	if len(r.getUnsupported(cc, pb.ProtocolVersion)) != 2 {
+		t.Errorf("versions not reset")
+	}
+}
+
+func TestConfigChangeIsVersionedWhenSupportedByAllMembers(t *testing.T) {
+	r := newActiveTestLeader(t, []uint64{1, 2, 3})
+	cc := proposeTestConfigChange(t, r,
+		pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 3})
+	if cc.ProtocolVersion != pb.ProtocolVersion ||
+		cc.MaxRemoved != r.maxRemoved {
+		t.Errorf("config change not versioned, %+v", cc)
+	}
+	r.remotes[2].version = 0
+	cc = pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 3}
+	if !proposeVersionTestConfigChange(t, r, cc) {
+		t.Fatalf("config change dropped")
+	}
+	ents, err := r.log.entries(r.log.lastIndex(), noLimit)
+	if err != nil {
+		t.Fatalf("failed to get entries %v", err)
+	}
+	var result pb.ConfigChange
+	pb.MustUnmarshal(&result, ents[0].Cmd)
+	if result.ProtocolVersion != 0 || result.MaxRemoved != 0 {
+		t.Errorf("config change unexpectedly versioned, %+v", result)
+	}
+}
+
+func TestConfigChangeRequiringNewRulesIsDroppedBeforeAllMembersSupportThem(t *testing.T) {
+	r := newActiveTestLeader(t, []uint64{1, 2, 3})
+	r.maxWitnesses = 0
+	tests := []pb.ConfigChange{
+		// unsafe, replica 3 is inactive
+		{Type: pb.RemoveNode, ReplicaID: 2},
+		{Type: pb.AddWitness, ReplicaID: 4, Address: "a4"},
+		{Type: pb.AddNode, ReplicaID: 4, Address: "a4", AllowReuse: true},
+	}
+	for idx, cc := range tests {
+		if proposeVersionTestConfigChange(t, r, cc) {
+			t.Errorf("%d, config change not dropped", idx)
+		}
+	}
+	setTestProtocolVersion(r, pb.ProtocolVersion)
+	for idx, cc := range tests {
+		if !proposeVersionTestConfigChange(t, r, cc) {
+			t.Errorf("%d, config change dropped", idx)
+		}
+	}
+}
+
+func TestShardVersionIsNotCheckedAgain(t *testing.T) {
+	r := newActiveTestLeader(t, []uint64{1, 2, 3})
+	cc := pb.ConfigChange{Type: pb.AddNonVoting, ReplicaID: 4, Address: "a4"}
+	if len(r.getUnsupported(cc, pb.ProtocolVersion)) == 0 {
+		t.Fatalf("unknown versions not reported")
+	}
+	p := &Peer{raft: r}
+	if err := p.ApplyConfigChange(pb.ConfigChange{Type: pb.AddNonVoting,
+		ReplicaID: 4, ProtocolVersion: pb.ProtocolVersion}); err != nil {
+		t.Fatalf("failed to apply config change %v", err)
+	}
+	if r.shardVersion != pb.ProtocolVersion {
+		t.Errorf("shard version not recorded, %d", r.shardVersion)
+	}
+	// versions are reset on leader change, the shard version is kept
+	r.becomeFollower(r.term+1, 2)
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	cc = pb.ConfigChange{Type: pb.EnterJoint, Members: map[uint64]string{1: "a1"}}
+	if unsupported := r.getUnsupported(cc, getRequiredVersion(cc)); len(unsupported) > 0 {
+		t.Errorf("unexpected unsupported members %v", unsupported)
+	}
+}
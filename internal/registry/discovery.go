@@ -0,0 +1,162 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/raftio"
+)
+
+// DiscoveryRegistry is a node registry that resolves NodeHostID targets using
+// a raftio.IRegistry instance. It is used when NodeHost instances are
+// addressed by their NodeHostID values.
+type DiscoveryRegistry struct {
+	nodes    *Registry
+	registry raftio.IRegistry
+}
+
+var _ raftio.INodeRegistry = (*DiscoveryRegistry)(nil)
+var _ IResolver = (*DiscoveryRegistry)(nil)
+
+// NewDiscoveryRegistry creates a new DiscoveryRegistry instance.
+func NewDiscoveryRegistry(r raftio.IRegistry,
+	streamConnections uint64, v config.TargetValidator) *DiscoveryRegistry {
+	return &DiscoveryRegistry{
+		nodes:    NewNodeRegistry(streamConnections, v),
+		registry: r,
+	}
+}
+
+// Close closes the DiscoveryRegistry and the underlying raftio.IRegistry
+// instance.
+func (n *DiscoveryRegistry) Close() error {
+	return n.registry.Close()
+}
+
+// Add adds a new node with its known NodeHostID to the registry.
+func (n *DiscoveryRegistry) Add(shardID uint64,
+	replicaID uint64, target string) {
+	n.nodes.Add(shardID, replicaID, target)
+}
+
+// Remove removes the specified node from the registry.
+func (n *DiscoveryRegistry) Remove(shardID uint64, replicaID uint64) {
+	n.nodes.Remove(shardID, replicaID)
+}
+
+// RemoveShard removes the specified shard from the registry.
+func (n *DiscoveryRegistry) RemoveShard(shardID uint64) {
+	n.nodes.RemoveShard(shardID)
+}
+
+// Resolve returns the current RaftAddress and connection key of the specified
+// node. It returns ErrUnknownTarget when the RaftAddress is unknown.
+func (n *DiscoveryRegistry) Resolve(shardID uint64,
+	replicaID uint64) (string, string, error) {
+	target, key, err := n.nodes.Resolve(shardID, replicaID)
+	if err != nil {
+		return "", "", err
+	}
+	if nh, ok := n.registry.GetNodeHost(target); ok {
+		return nh.RaftAddress, key, nil
+	}
+	return "", "", ErrUnknownTarget
+}
+
+// Publish publishes the specified shard info to the underlying registry.
+func (n *DiscoveryRegistry) Publish(shards []ShardInfo) error {
+	return n.registry.Publish(toShardViewList(shards))
+}
+
+// NumOfShards returns the number of shards known to the registry.
+func (n *DiscoveryRegistry) NumOfShards() int {
+	return n.registry.NumOfShards()
+}
+
+// GetMeta returns the metadata published by the specified NodeHost instance.
+func (n *DiscoveryRegistry) GetMeta(nhID string) ([]byte, bool) {
+	nh, ok := n.registry.GetNodeHost(nhID)
+	if !ok {
+		return nil, false
+	}
+	return nh.Meta, true
+}
+
+// GetNodeHostTags returns tags published by the specified NodeHost instance.
+func (n *DiscoveryRegistry) GetNodeHostTags(nhID string) (map[string]string, bool) {
+	nh, ok := n.registry.GetNodeHost(nhID)
+	if !ok {
+		return nil, false
+	}
+	return nh.Tags, true
+}
+
+// IsNodeHostDraining returns a boolean value indicating whether the specified
+// NodeHost instance is published as draining.
+func (n *DiscoveryRegistry) IsNodeHostDraining(nhID string) (bool, bool) {
+	nh, ok := n.registry.GetNodeHost(nhID)
+	if !ok {
+		return false, false
+	}
+	return nh.Draining, true
+}
+
+// GetShardInfo returns the shard info for the specified shard if it is
+// available in the registry.
+func (n *DiscoveryRegistry) GetShardInfo(shardID uint64) (ShardView, bool) {
+	return n.registry.GetShardView(shardID)
+}
+
+// GetShardPlacement returns the placement of replicas of the specified shard
+// if it is available in the registry. The UpdatedAt field of the returned
+// placement is not tracked.
+func (n *DiscoveryRegistry) GetShardPlacement(shardID uint64) (ShardPlacement, bool) {
+	sv, ok := n.registry.GetShardView(shardID)
+	if !ok {
+		return ShardPlacement{}, false
+	}
+	return getShardPlacement(sv, time.Time{}, n.getRaftAddress, n.getLiveness), true
+}
+
+// ListShards always returns nil as the underlying raftio.IRegistry instance
+// doesn't support listing shards.
+func (n *DiscoveryRegistry) ListShards(filter ShardFilter) []ShardPlacement {
+	return nil
+}
+
+// Watch returns a channel that never receives any event as the underlying
+// raftio.IRegistry instance doesn't support change notifications.
+func (n *DiscoveryRegistry) Watch(buffer int) (<-chan RegistryEvent, func()) {
+	return idleWatch(buffer)
+}
+
+func (n *DiscoveryRegistry) getRaftAddress(nhID string) (string, bool) {
+	nh, ok := n.registry.GetNodeHost(nhID)
+	if !ok {
+		return "", false
+	}
+	return nh.RaftAddress, true
+}
+
+// getLiveness reports NodeHost instances known to the underlying registry as
+// alive as there is no failure detector.
+func (n *DiscoveryRegistry) getLiveness(nhID string) NodeHostLiveness {
+	if _, ok := n.registry.GetNodeHost(nhID); ok {
+		return NodeHostAlive
+	}
+	return NodeHostUnknown
+}
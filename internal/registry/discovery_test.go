@@ -0,0 +1,120 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+
+	"github.com/lni/dragonboat/v4/internal/id"
+	"github.com/lni/dragonboat/v4/raftio"
+)
+
+type testRegistry struct {
+	nodeHosts map[string]raftio.NodeHostInfo
+	published []raftio.ShardView
+	closed    bool
+}
+
+var _ raftio.IRegistry = (*testRegistry)(nil)
+
+func (r *testRegistry) GetNodeHost(nhid string) (raftio.NodeHostInfo, bool) {
+	nh, ok := r.nodeHosts[nhid]
+	return nh, ok
+}
+
+func (r *testRegistry) NodeHosts() []raftio.NodeHostInfo {
+	result := make([]raftio.NodeHostInfo, 0)
+	for _, nh := range r.nodeHosts {
+		result = append(result, nh)
+	}
+	return result
+}
+
+func (r *testRegistry) Publish(shards []raftio.ShardView) error {
+	r.published = shards
+	return nil
+}
+
+func (r *testRegistry) GetShardView(shardID uint64) (raftio.ShardView, bool) {
+	for _, sv := range r.published {
+		if sv.ShardID == shardID {
+			return sv, true
+		}
+	}
+	return raftio.ShardView{}, false
+}
+
+func (r *testRegistry) NumOfShards() int {
+	return len(r.published)
+}
+
+func (r *testRegistry) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestDiscoveryRegistry(t *testing.T) {
+	tr := &testRegistry{
+		nodeHosts: map[string]raftio.NodeHostInfo{
+			testNodeHostID1: {
+				NodeHostID:  testNodeHostID1,
+				RaftAddress: "localhost:27001",
+				Meta:        []byte("meta"),
+			},
+		},
+	}
+	r := NewDiscoveryRegistry(tr, 1, id.IsNodeHostID)
+	r.Add(123, 1, testNodeHostID1)
+	r.Add(123, 2, testNodeHostID2)
+	addr, _, err := r.Resolve(123, 1)
+	if err != nil || addr != "localhost:27001" {
+		t.Errorf("unexpected addr %s, %v", addr, err)
+	}
+	if _, _, err := r.Resolve(123, 2); err != ErrUnknownTarget {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, _, err := r.Resolve(123, 3); err != ErrUnknownTarget {
+		t.Errorf("unexpected error %v", err)
+	}
+	if v, ok := r.GetMeta(testNodeHostID1); !ok || string(v) != "meta" {
+		t.Errorf("unexpected meta %s", v)
+	}
+	if _, ok := r.GetMeta(testNodeHostID2); ok {
+		t.Errorf("unexpected meta")
+	}
+	info := []ShardInfo{
+		{
+			ShardID:           123,
+			ReplicaID:         1,
+			Replicas:          map[uint64]string{1: testNodeHostID1},
+			ConfigChangeIndex: 5,
+			LeaderID:          1,
+			Term:              2,
+		},
+	}
+	if err := r.Publish(info); err != nil {
+		t.Fatalf("failed to publish %v", err)
+	}
+	sv, ok := r.GetShardInfo(123)
+	if !ok || sv.ConfigChangeIndex != 5 || sv.LeaderID != 1 || sv.Term != 2 {
+		t.Errorf("unexpected shard view %+v", sv)
+	}
+	if r.NumOfShards() != 1 {
+		t.Errorf("unexpected shard count")
+	}
+	if err := r.Close(); err != nil || !tr.closed {
+		t.Errorf("registry not closed, %v", err)
+	}
+}
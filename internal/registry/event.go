@@ -15,20 +15,27 @@
 package registry
 
 import (
+	"time"
+
 	"github.com/hashicorp/memberlist"
 )
 
 // sliceEventDelegate is used to hook into memberlist to get notification
 // about nodes joining and leaving.
 type sliceEventDelegate struct {
-	store *metaStore
+	store    *metaStore
+	liveness *liveness
+	watchers *watchers
 }
 
 var _ memberlist.EventDelegate = (*sliceEventDelegate)(nil)
 
-func newSliceEventDelegate(store *metaStore) *sliceEventDelegate {
+func newSliceEventDelegate(store *metaStore,
+	liveness *liveness, watchers *watchers) *sliceEventDelegate {
 	return &sliceEventDelegate{
-		store: store,
+		store:    store,
+		liveness: liveness,
+		watchers: watchers,
 	}
 }
 
@@ -37,15 +44,37 @@ func (e *sliceEventDelegate) put(eventType memberlist.NodeEventType,
 	if eventType == memberlist.NodeJoin || eventType == memberlist.NodeUpdate {
 		var m meta
 		if m.unmarshal(n.Meta) {
+			old, ok := e.store.get(n.Name)
 			e.store.put(n.Name, m)
+			e.liveness.joined(n.Name, m.RaftAddress)
+			if !ok {
+				e.notify(NodeHostJoined, n.Name, m.RaftAddress)
+			} else if old.RaftAddress != m.RaftAddress {
+				e.notify(NodeHostAddressChanged, n.Name, m.RaftAddress)
+			}
 		}
 	} else if eventType == memberlist.NodeLeave {
+		old, ok := e.store.get(n.Name)
 		e.store.delete(n.Name)
+		e.liveness.left(n.Name)
+		if ok {
+			e.notify(NodeHostLeft, n.Name, old.RaftAddress)
+		}
 	} else {
 		panic("unknown event type")
 	}
 }
 
+func (e *sliceEventDelegate) notify(t RegistryEventType,
+	nhid string, raftAddress string) {
+	e.watchers.publish(RegistryEvent{
+		Type:        t,
+		Time:        time.Now(),
+		NodeHostID:  nhid,
+		RaftAddress: raftAddress,
+	})
+}
+
 func (e *sliceEventDelegate) NotifyJoin(n *memberlist.Node) {
 	e.put(memberlist.NodeJoin, n)
 }
@@ -57,3 +86,20 @@ func (e *sliceEventDelegate) NotifyLeave(n *memberlist.Node) {
 func (e *sliceEventDelegate) NotifyUpdate(n *memberlist.Node) {
 	e.put(memberlist.NodeUpdate, n)
 }
+
+// pingDelegate is used to hook into memberlist to get notification about
+// completed probes.
+type pingDelegate struct {
+	liveness *liveness
+}
+
+var _ memberlist.PingDelegate = (*pingDelegate)(nil)
+
+func (p *pingDelegate) AckPayload() []byte {
+	return nil
+}
+
+func (p *pingDelegate) NotifyPingComplete(n *memberlist.Node,
+	rtt time.Duration, payload []byte) {
+	p.liveness.acked(n.Name)
+}
@@ -16,10 +16,14 @@ package registry
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -29,18 +33,50 @@ import (
 
 	"github.com/lni/dragonboat/v4/config"
 	"github.com/lni/dragonboat/v4/logger"
+	"github.com/lni/dragonboat/v4/raftio"
 )
 
 var plog = logger.GetLogger("registry")
 
 type getShardInfo func() []ShardInfo
 
+const (
+	minJoinBackoff    = 200 * time.Millisecond
+	maxJoinBackoff    = 3 * time.Second
+	joinCheckInterval = 500 * time.Millisecond
+	seedLookupTimeout = 3 * time.Second
+)
+
+// IGossipEvent is the interface used by the gossip service to report changes
+// of its membership state.
+type IGossipEvent interface {
+	GossipIsolated(addr string)
+	GossipRejoined(addr string, members int)
+	NodeHostSuspected(nhid string, raftAddress string)
+	NodeHostRecovered(nhid string, raftAddress string)
+}
+
 // meta is the metadata of the node. The actual payload is specified by the user
-// by setting the Config.GossipConfig.Meta field. meta contains node information
-// that will not change during the life of a particular NodeHost process.
+// by setting the Config.GossipConfig.Meta and Config.GossipConfig.Tags fields.
+// Other than Tags, meta contains node information that will not change during
+// the life of a particular NodeHost process.
 type meta struct {
 	RaftAddress string
 	Data        []byte
+	Tags        map[string]string
+	Draining    bool
+}
+
+// copyTags returns a copy of the specified tags.
+func copyTags(tags map[string]string) map[string]string {
+	if tags == nil {
+		return nil
+	}
+	result := make(map[string]string, len(tags))
+	for k, v := range tags {
+		result[k] = v
+	}
+	return result
 }
 
 func (m *meta) marshal() []byte {
@@ -97,21 +133,23 @@ func (m *metaStore) delete(name string) {
 // GossipRegistry is a node registry backed by gossip. It is capable of
 // supporting NodeHosts with dynamic RaftAddress values.
 type GossipRegistry struct {
-	nodes  *Registry
+	*DiscoveryRegistry
 	gossip *gossipManager
 }
 
-// NewGossipRegistry creates a new GossipRegistry instance.
+// NewGossipRegistry creates a new GossipRegistry instance. It returns the
+// ErrJoinFailed error when the gossip group can not be joined within the
+// GossipConfig.JoinTimeout budget.
 func NewGossipRegistry(nhid string, f getShardInfo,
 	nhConfig config.NodeHostConfig, streamConnections uint64,
-	v config.TargetValidator) (*GossipRegistry, error) {
-	gossip, err := newGossipManager(nhid, f, nhConfig)
+	v config.TargetValidator, events IGossipEvent) (*GossipRegistry, error) {
+	gossip, err := newGossipManager(nhid, f, nhConfig, events)
 	if err != nil {
 		return nil, err
 	}
 	r := &GossipRegistry{
-		nodes:  NewNodeRegistry(streamConnections, v),
-		gossip: gossip,
+		DiscoveryRegistry: NewDiscoveryRegistry(gossip, streamConnections, v),
+		gossip:            gossip,
 	}
 	return r, nil
 }
@@ -121,9 +159,10 @@ func (n *GossipRegistry) GetNodeHostRegistry() *NodeHostRegistry {
 	return n.gossip.GetNodeHostRegistry()
 }
 
-// Close closes the GossipRegistry instance.
-func (n *GossipRegistry) Close() error {
-	return n.gossip.Close()
+// Watch returns a channel for receiving changes of the registry, see
+// NodeHostRegistry.Watch for details.
+func (n *GossipRegistry) Watch(buffer int) (<-chan RegistryEvent, func()) {
+	return n.gossip.registry.Watch(buffer)
 }
 
 // AdvertiseAddress returns the advertise address of the gossip service.
@@ -131,53 +170,101 @@ func (n *GossipRegistry) AdvertiseAddress() string {
 	return n.gossip.advertiseAddress()
 }
 
-// NumMembers returns the number of live nodes known by the gossip service.
-func (n *GossipRegistry) NumMembers() int {
-	return n.gossip.numMembers()
+// UpdateTags replaces the tags of the local NodeHost, the update is
+// propagated to other NodeHost instances by gossip. ErrMetaTooBig is returned
+// when the tags can not be included in the gossip payload.
+func (n *GossipRegistry) UpdateTags(tags map[string]string) error {
+	return n.gossip.updateTags(tags)
+}
+
+// SetDraining sets the drain state of the local NodeHost, the update is
+// propagated to other NodeHost instances by gossip.
+func (n *GossipRegistry) SetDraining(draining bool) error {
+	return n.gossip.setDraining(draining)
+}
+
+// Draining returns a boolean value indicating whether the local NodeHost is
+// advertised as draining.
+func (n *GossipRegistry) Draining() bool {
+	return n.gossip.delegate.getMeta().Draining
 }
 
-// Add adds a new node with its known NodeHostID to the registry.
-func (n *GossipRegistry) Add(shardID uint64,
-	replicaID uint64, target string) {
-	n.nodes.Add(shardID, replicaID, target)
+// AddKey adds the specified key to the keyring of the gossip service.
+// ErrEncryptionDisabled is returned when gossip messages are not encrypted.
+func (n *GossipRegistry) AddKey(key []byte) error {
+	return n.gossip.addKey(key)
 }
 
-// Remove removes the specified node from the registry.
-func (n *GossipRegistry) Remove(shardID uint64, replicaID uint64) {
-	n.nodes.Remove(shardID, replicaID)
+// UseKey makes the specified key, which must have been added to the keyring,
+// the primary key used for encrypting gossip messages.
+func (n *GossipRegistry) UseKey(key []byte) error {
+	return n.gossip.useKey(key)
 }
 
-// RemoveShard removes the specified shard from the registry.
-func (n *GossipRegistry) RemoveShard(shardID uint64) {
-	n.nodes.RemoveShard(shardID)
+// RemoveKey removes the specified key from the keyring, the primary key can
+// not be removed.
+func (n *GossipRegistry) RemoveKey(key []byte) error {
+	return n.gossip.removeKey(key)
+}
+
+// KeyFingerprints returns fingerprints of keys in the keyring of the gossip
+// service, the first one is the fingerprint of the primary key.
+func (n *GossipRegistry) KeyFingerprints() []string {
+	return n.gossip.keyFingerprints()
 }
 
 // Resolve returns the current RaftAddress and connection key of the specified
-// node. It returns ErrUnknownTarget when the RaftAddress is unknown.
+// node. It returns ErrUnknownTarget when the RaftAddress is unknown, or
+// ErrNodeHostSuspect when the NodeHost running the node has been suspected as
+// failed by the gossip service for longer than the
+// GossipConfig.SuspectGracePeriod.
 func (n *GossipRegistry) Resolve(shardID uint64,
 	replicaID uint64) (string, string, error) {
 	target, key, err := n.nodes.Resolve(shardID, replicaID)
 	if err != nil {
 		return "", "", err
 	}
-	addr, ok := n.gossip.GetRaftAddress(target)
-	if ok {
-		return addr, key, nil
+	if err := n.gossip.liveness.check(target); err != nil {
+		return "", "", err
+	}
+	if nh, ok := n.registry.GetNodeHost(target); ok {
+		return nh.RaftAddress, key, nil
 	}
 	return "", "", ErrUnknownTarget
 }
 
+// NumMembers returns the number of live nodes known by the gossip service.
+func (n *GossipRegistry) NumMembers() int {
+	return n.gossip.numMembers()
+}
+
 // delegate is used to hook into memberlist's gossip layer.
 type delegate struct {
 	getShardInfo getShardInfo
-	meta         meta
 	view         *view
+	mu           struct {
+		sync.Mutex
+		meta meta
+	}
+}
+
+func (d *delegate) getMeta() meta {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.mu.meta
+}
+
+func (d *delegate) setMeta(m meta) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.mu.meta = m
 }
 
 var _ memberlist.Delegate = (*delegate)(nil)
 
 func (d *delegate) NodeMeta(limit int) []byte {
-	m := d.meta.marshal()
+	md := d.getMeta()
+	m := md.marshal()
 	if len(m) > limit {
 		panic("meta message is too big")
 	}
@@ -228,18 +315,35 @@ func parseAddress(addr string) (string, int, error) {
 	return host, int(port), nil
 }
 
+var _ raftio.IRegistry = (*gossipManager)(nil)
+
 type gossipManager struct {
+	// keyMu serializes changes to the keyring
+	keyMu    sync.Mutex
 	nhConfig config.NodeHostConfig
 	cfg      *memberlist.Config
 	list     *memberlist.Memberlist
 	view     *view
 	store    *metaStore
+	liveness *liveness
+	registry *NodeHostRegistry
+	delegate *delegate
+	seed     []string
+	resolver config.HostResolver
+	clock    config.Clock
+	events   IGossipEvent
 	stopper  *syncutil.Stopper
 }
 
 func newGossipManager(nhid string, f getShardInfo,
-	nhConfig config.NodeHostConfig) (*gossipManager, error) {
+	nhConfig config.NodeHostConfig, events IGossipEvent) (*gossipManager, error) {
+	clock := nhConfig.Expert.Clock
+	if clock == nil {
+		clock = config.DefaultClock
+	}
 	store := &metaStore{}
+	liveness := newLiveness(nhConfig.Gossip.SuspectGracePeriod)
+	liveness.clock = clock.Now
 	cfg := memberlist.DefaultWANConfig()
 	cfg.Logger = newGossipLogWrapper()
 	cfg.Name = nhid
@@ -247,6 +351,22 @@ func newGossipManager(nhid string, f getShardInfo,
 	cfg.GossipInterval = 250 * time.Millisecond
 	cfg.GossipNodes = 6
 	cfg.UDPBufferSize = 32 * 1024
+	if keys := nhConfig.Gossip.Keys; len(keys) > 0 {
+		keyring, err := memberlist.NewKeyring(copyKeys(keys), copyKey(keys[0]))
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidKey, "%v", err)
+		}
+		cfg.Keyring = keyring
+		cfg.GossipVerifyIncoming = !nhConfig.AllowUnauthenticatedTransport
+		cfg.GossipVerifyOutgoing = !nhConfig.AllowUnauthenticatedTransport
+	} else if len(nhConfig.TransportAuthToken) > 0 {
+		// gossip messages are encrypted using a key derived from the token,
+		// unencrypted messages are accepted and sent during the transition
+		key := sha256.Sum256([]byte(nhConfig.TransportAuthToken))
+		cfg.SecretKey = key[:]
+		cfg.GossipVerifyIncoming = !nhConfig.AllowUnauthenticatedTransport
+		cfg.GossipVerifyOutgoing = !nhConfig.AllowUnauthenticatedTransport
+	}
 	if nhConfig.Expert.TestGossipProbeInterval > 0 {
 		plog.Infof("gossip probe interval set to %s",
 			nhConfig.Expert.TestGossipProbeInterval)
@@ -268,61 +388,321 @@ func newGossipManager(nhid string, f getShardInfo,
 		cfg.AdvertisePort = aPort
 		plog.Infof("gossip advertise address %s port %d", aAddr, aPort)
 	}
+	if socket := nhConfig.Expert.Socket; !socket.IsEmpty() {
+		plog.Infof("gossip socket options: %+v", socket)
+		transport, err := newGossipTransport(bindAddr, bindPort, socket)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Transport = transport
+	}
 	view := newView(nhConfig.GetDeploymentID())
+	view.clock = clock.Now
+	registry := &NodeHostRegistry{
+		view:     view,
+		store:    store,
+		liveness: liveness,
+		watchers: newWatchers(),
+	}
+	view.onChange = registry.shardsChanged
 	meta := meta{
 		RaftAddress: nhConfig.RaftAddress,
 		Data:        nhConfig.Gossip.Meta,
+		Tags:        copyTags(nhConfig.Gossip.Tags),
 	}
-	cfg.Delegate = &delegate{
-		meta:         meta,
+	if len(meta.marshal()) > memberlist.MetaMaxSize {
+		return nil, ErrMetaTooBig
+	}
+	d := &delegate{
 		getShardInfo: f,
 		view:         view,
 	}
+	d.setMeta(meta)
+	cfg.Delegate = d
 	// set memberlist's event delegate
-	cfg.Events = newSliceEventDelegate(store)
+	cfg.Events = newSliceEventDelegate(store, liveness, registry.watchers)
+	cfg.Ping = &pingDelegate{liveness: liveness}
 
 	list, err := memberlist.Create(cfg)
 	if err != nil {
 		plog.Errorf("failed to create memberlist, %v", err)
+		if cfg.Transport != nil {
+			if cerr := cfg.Transport.Shutdown(); cerr != nil {
+				plog.Errorf("failed to shutdown the gossip transport, %v", cerr)
+			}
+		}
 		return nil, err
 	}
 	seed := make([]string, 0, len(nhConfig.Gossip.Seed))
 	seed = append(seed, nhConfig.Gossip.Seed...)
+	resolver := nhConfig.Expert.GossipSeedResolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
 	g := &gossipManager{
 		nhConfig: nhConfig,
 		cfg:      cfg,
 		list:     list,
 		view:     view,
 		store:    store,
+		liveness: liveness,
+		registry: registry,
+		delegate: d,
+		seed:     seed,
+		resolver: resolver,
+		clock:    clock,
+		events:   events,
 		stopper:  syncutil.NewStopper(),
 	}
 	// eventDelegate must be started first, otherwise join() could be blocked
 	// on a large cluster
-	g.join(seed)
-	g.stopper.RunWorker(func() {
-		ticker := time.NewTicker(500 * time.Millisecond)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				if len(g.list.Members()) > 1 {
-					continue
-				}
-				g.join(seed)
-			case <-g.stopper.ShouldStop():
-				return
-			}
+	joined, err := g.bootstrap()
+	if err != nil {
+		if err := list.Shutdown(); err != nil {
+			plog.Errorf("failed to shutdown memberlist, %v", err)
 		}
+		return nil, err
+	}
+	if !joined {
+		g.isolated()
+	}
+	g.stopper.RunWorker(func() {
+		g.rejoinMain(!joined)
 	})
+	if liveness.enabled() {
+		g.stopper.RunWorker(func() {
+			g.livenessMain()
+		})
+	}
 	return g, nil
 }
 
-func (g *gossipManager) join(seed []string) {
-	if _, err := g.list.Join(seed); err != nil {
+// bootstrap joins the gossip group. Failed join attempts are retried with
+// exponential backoff until the GossipConfig.JoinTimeout budget is exhausted.
+// It returns a boolean flag indicating whether the gossip group is joined.
+func (g *gossipManager) bootstrap() (bool, error) {
+	timeout := g.nhConfig.Gossip.JoinTimeout
+	deadline := time.Now().Add(timeout)
+	backoff := minJoinBackoff
+	for {
+		err := g.join()
+		if err == nil {
+			return true, nil
+		}
 		plog.Errorf("failed to join the gossip group, %v", err)
+		if timeout == 0 {
+			return false, nil
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			if g.nhConfig.Gossip.ContinueOnJoinFailure {
+				plog.Warningf("gossip group not joined in %s, continue in "+
+					"isolated mode", timeout)
+				return false, nil
+			}
+			return false, errors.Wrapf(ErrJoinFailed, "%v", err)
+		}
+		if wait > backoff {
+			wait = backoff
+		}
+		time.Sleep(wait)
+		backoff = nextJoinBackoff(backoff)
+	}
+}
+
+// rejoinMain monitors the membership of the local gossip service, it tries to
+// rejoin the gossip group with exponential backoff when the local gossip
+// service is the only live member.
+func (g *gossipManager) rejoinMain(isolated bool) {
+	backoff := minJoinBackoff
+	timer := time.NewTimer(joinCheckInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-g.stopper.ShouldStop():
+			return
+		}
+		wait := joinCheckInterval
+		if g.numMembers() <= 1 {
+			if !isolated {
+				isolated = true
+				g.isolated()
+			}
+			if err := g.join(); err != nil {
+				plog.Warningf("failed to rejoin the gossip group, %v", err)
+				wait = backoff
+				backoff = nextJoinBackoff(backoff)
+			}
+		}
+		if n := g.numMembers(); n > 1 {
+			if isolated {
+				isolated = false
+				g.rejoined(n)
+			}
+			backoff = minJoinBackoff
+		}
+		timer.Reset(wait)
+	}
+}
+
+// livenessMain probes NodeHost instances recently resolved as message targets
+// when they haven't responded to any gossip probe in the last probe interval,
+// NodeHost instances failing such probes are considered as suspect. This
+// allows failed NodeHost instances to be detected long before the gossip
+// service declares them as dead.
+func (g *gossipManager) livenessMain() {
+	ticker := g.clock.NewTicker(g.cfg.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-g.stopper.ShouldStop():
+			return
+		}
+		g.probe()
+		for _, c := range g.liveness.changes() {
+			if c.recovered {
+				g.recovered(c.nhid, c.raftAddress)
+			} else {
+				g.suspected(c.nhid, c.raftAddress)
+			}
+		}
 	}
 }
 
+func (g *gossipManager) probe() {
+	targets := g.liveness.toProbe(g.cfg.ProbeInterval)
+	if len(targets) == 0 {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, n := range g.list.Members() {
+		if _, ok := targets[n.Name]; !ok || n.Name == g.cfg.Name {
+			continue
+		}
+		name := n.Name
+		addr := &net.UDPAddr{IP: n.Addr, Port: int(n.Port)}
+		started := g.liveness.clock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := g.list.Ping(name, addr); err != nil {
+				g.liveness.probeFailed(name, started)
+			} else {
+				g.liveness.acked(name)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (g *gossipManager) suspected(nhid string, raftAddress string) {
+	plog.Warningf("NodeHost %s (%s) is suspected as failed", nhid, raftAddress)
+	if g.events != nil {
+		g.events.NodeHostSuspected(nhid, raftAddress)
+	}
+}
+
+func (g *gossipManager) recovered(nhid string, raftAddress string) {
+	plog.Infof("NodeHost %s (%s) recovered", nhid, raftAddress)
+	if g.events != nil {
+		g.events.NodeHostRecovered(nhid, raftAddress)
+	}
+}
+
+func nextJoinBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxJoinBackoff {
+		return maxJoinBackoff
+	}
+	return backoff
+}
+
+func (g *gossipManager) isolated() {
+	plog.Warningf("gossip service %s is isolated", g.advertiseAddress())
+	if g.events != nil {
+		g.events.GossipIsolated(g.advertiseAddress())
+	}
+}
+
+func (g *gossipManager) rejoined(members int) {
+	plog.Infof("gossip service %s rejoined, %d members",
+		g.advertiseAddress(), members)
+	if g.events != nil {
+		g.events.GossipRejoined(g.advertiseAddress(), members)
+	}
+}
+
+// join resolves the seed addresses and tries to join the gossip group using
+// the resolved addresses. The gossip group is considered as joined when at
+// least one other live member is known.
+func (g *gossipManager) join() error {
+	seed, err := resolveSeeds(g.resolver, g.seed)
+	if err != nil {
+		return err
+	}
+	if _, err := g.list.Join(seed); err != nil {
+		return err
+	}
+	if g.numMembers() <= 1 {
+		return errors.New("no other gossip member")
+	}
+	return nil
+}
+
+// resolveSeeds resolves hostnames and DNS names in the specified seed
+// addresses. Seed addresses that can not be resolved are skipped, an error is
+// returned when none of them can be resolved.
+func resolveSeeds(r config.HostResolver, seed []string) ([]string, error) {
+	result := make([]string, 0, len(seed))
+	seen := make(map[string]struct{})
+	var lastErr error
+	for _, s := range seed {
+		addrs, err := resolveSeed(r, s)
+		if err != nil {
+			plog.Warningf("failed to resolve seed %s, %v", s, err)
+			lastErr = err
+			continue
+		}
+		for _, addr := range addrs {
+			if _, ok := seen[addr]; !ok {
+				seen[addr] = struct{}{}
+				result = append(result, addr)
+			}
+		}
+	}
+	if len(result) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no seed address")
+		}
+		return nil, lastErr
+	}
+	return result, nil
+}
+
+func resolveSeed(r config.HostResolver, seed string) ([]string, error) {
+	addr := strings.TrimPrefix(seed, config.GossipDNSSeedPrefix)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), seedLookupTimeout)
+	defer cancel()
+	ips, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		result = append(result, net.JoinHostPort(ip, port))
+	}
+	return result, nil
+}
+
 func (g *gossipManager) Close() error {
 	g.stopper.Stop()
 	if err := g.list.Leave(time.Second); err != nil {
@@ -335,10 +715,7 @@ func (g *gossipManager) Close() error {
 }
 
 func (g *gossipManager) GetNodeHostRegistry() *NodeHostRegistry {
-	return &NodeHostRegistry{
-		view:  g.view,
-		store: g.store,
-	}
+	return g.registry
 }
 
 func (g *gossipManager) GetRaftAddress(nhid string) (string, bool) {
@@ -351,6 +728,164 @@ func (g *gossipManager) GetRaftAddress(nhid string) (string, bool) {
 	return "", false
 }
 
+// GetNodeHost returns the NodeHostInfo of the specified NodeHost instance.
+func (g *gossipManager) GetNodeHost(nhid string) (raftio.NodeHostInfo, bool) {
+	var m meta
+	if g.cfg.Name == nhid {
+		m = g.delegate.getMeta()
+	} else if v, ok := g.store.get(nhid); ok {
+		m = v
+	} else {
+		return raftio.NodeHostInfo{}, false
+	}
+	return raftio.NodeHostInfo{
+		NodeHostID:  nhid,
+		RaftAddress: m.RaftAddress,
+		Meta:        m.Data,
+		Tags:        copyTags(m.Tags),
+		Draining:    m.Draining,
+	}, true
+}
+
+// updateTags replaces the tags of the local NodeHost and propagates them to
+// other NodeHost instances.
+func (g *gossipManager) updateTags(tags map[string]string) error {
+	m := g.delegate.getMeta()
+	m.Tags = copyTags(tags)
+	if len(m.marshal()) > memberlist.MetaMaxSize {
+		return ErrMetaTooBig
+	}
+	g.delegate.setMeta(m)
+	return g.list.UpdateNode(time.Second)
+}
+
+// setDraining sets the drain state of the local NodeHost and propagates it to
+// other NodeHost instances. The drain state is a part of the node metadata, it
+// is also carried in the periodic full state sync so NodeHost instances that
+// missed the update eventually learn it.
+func (g *gossipManager) setDraining(draining bool) error {
+	m := g.delegate.getMeta()
+	if m.Draining == draining {
+		return nil
+	}
+	m.Draining = draining
+	g.delegate.setMeta(m)
+	return g.list.UpdateNode(time.Second)
+}
+
+// NodeHosts returns the NodeHostInfo of all live NodeHost instances known to
+// the gossip service.
+func (g *gossipManager) NodeHosts() []raftio.NodeHostInfo {
+	members := g.list.Members()
+	result := make([]raftio.NodeHostInfo, 0, len(members))
+	for _, m := range members {
+		if nh, ok := g.GetNodeHost(m.Name); ok {
+			result = append(result, nh)
+		}
+	}
+	return result
+}
+
+// Publish updates the local view with the specified shard views, the view is
+// propagated to other NodeHost instances by gossip.
+func (g *gossipManager) Publish(shards []ShardView) error {
+	g.view.update(shards)
+	return nil
+}
+
+// GetShardView returns the view of the specified shard.
+func (g *gossipManager) GetShardView(shardID uint64) (ShardView, bool) {
+	return g.GetNodeHostRegistry().GetShardInfo(shardID)
+}
+
+// NumOfShards returns the number of shards known to the gossip service.
+func (g *gossipManager) NumOfShards() int {
+	return g.view.shardCount()
+}
+
+// addKey adds the specified key to the keyring, it is accepted for decrypting
+// incoming messages once added.
+func (g *gossipManager) addKey(key []byte) error {
+	g.keyMu.Lock()
+	defer g.keyMu.Unlock()
+	if g.cfg.Keyring == nil {
+		return ErrEncryptionDisabled
+	}
+	if err := memberlist.ValidateKey(key); err != nil {
+		return errors.Wrapf(ErrInvalidKey, "%v", err)
+	}
+	if err := g.cfg.Keyring.AddKey(copyKey(key)); err != nil {
+		return errors.Wrapf(ErrInvalidKey, "%v", err)
+	}
+	plog.Infof("gossip key %s added", keyFingerprint(key))
+	return nil
+}
+
+// useKey makes the specified key in the keyring the primary key used for
+// encrypting outgoing messages.
+func (g *gossipManager) useKey(key []byte) error {
+	g.keyMu.Lock()
+	defer g.keyMu.Unlock()
+	if g.cfg.Keyring == nil {
+		return ErrEncryptionDisabled
+	}
+	if err := g.cfg.Keyring.UseKey(key); err != nil {
+		return errors.Wrapf(ErrInvalidKey, "%v", err)
+	}
+	plog.Infof("gossip key %s set as the primary key", keyFingerprint(key))
+	return nil
+}
+
+// removeKey removes the specified key from the keyring, the primary key can
+// not be removed.
+func (g *gossipManager) removeKey(key []byte) error {
+	g.keyMu.Lock()
+	defer g.keyMu.Unlock()
+	if g.cfg.Keyring == nil {
+		return ErrEncryptionDisabled
+	}
+	if err := g.cfg.Keyring.RemoveKey(key); err != nil {
+		return errors.Wrapf(ErrInvalidKey, "%v", err)
+	}
+	plog.Infof("gossip key %s removed", keyFingerprint(key))
+	return nil
+}
+
+// keyFingerprints returns fingerprints of keys in the keyring, the first one
+// is the fingerprint of the primary key.
+func (g *gossipManager) keyFingerprints() []string {
+	g.keyMu.Lock()
+	defer g.keyMu.Unlock()
+	if g.cfg.Keyring == nil {
+		return nil
+	}
+	keys := g.cfg.Keyring.GetKeys()
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, keyFingerprint(key))
+	}
+	return result
+}
+
+// keyFingerprint returns a fingerprint of the key that can be logged or
+// displayed without revealing the key.
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func copyKey(key []byte) []byte {
+	return append([]byte{}, key...)
+}
+
+func copyKeys(keys [][]byte) [][]byte {
+	result := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, copyKey(key))
+	}
+	return result
+}
+
 func (g *gossipManager) advertiseAddress() string {
 	return g.list.LocalNode().Address()
 }
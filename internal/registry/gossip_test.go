@@ -15,9 +15,14 @@
 package registry
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/cockroachdb/errors"
+	"github.com/hashicorp/memberlist"
 	"github.com/lni/goutils/leaktest"
 	"github.com/stretchr/testify/assert"
 
@@ -64,7 +69,7 @@ func TestGossipRegistry(t *testing.T) {
 			Seed:             []string{"127.0.0.1:26002"},
 		},
 	}
-	r, err := NewGossipRegistry(nhid, nil, nhConfig, 1, id.IsNodeHostID)
+	r, err := NewGossipRegistry(nhid, nil, nhConfig, 1, id.IsNodeHostID, nil)
 	if err != nil {
 		t.Fatalf("failed to create the registry, %v", err)
 	}
@@ -116,7 +121,7 @@ func TestGossipManagerCanBeCreatedAndStopped(t *testing.T) {
 			Seed:             []string{"127.0.0.1:26002"},
 		},
 	}
-	m, err := newGossipManager(nhid, nil, nhConfig)
+	m, err := newGossipManager(nhid, nil, nhConfig, nil)
 	if err != nil {
 		t.Fatalf("gossip manager failed to start, %v", err)
 	}
@@ -140,13 +145,13 @@ func TestGossipManagerCanBeCreatedAndStopped(t *testing.T) {
 	}
 }
 
-func TestGossipManagerCanGossip(t *testing.T) {
-	defer leaktest.AfterTest(t)()
+func testGossipManagerCanGossip(t *testing.T, socket config.SocketConfig) {
 	nhid1 := testNodeHostID1
 	nhConfig1 := config.NodeHostConfig{
 		RaftAddress: "localhost:27001",
 		Expert: config.ExpertConfig{
 			TestGossipProbeInterval: 10 * time.Millisecond,
+			Socket:                  socket,
 		},
 		Gossip: config.GossipConfig{
 			BindAddress:      "localhost:26001",
@@ -159,6 +164,7 @@ func TestGossipManagerCanGossip(t *testing.T) {
 		RaftAddress: "localhost:27002",
 		Expert: config.ExpertConfig{
 			TestGossipProbeInterval: 10 * time.Millisecond,
+			Socket:                  socket,
 		},
 		Gossip: config.GossipConfig{
 			BindAddress:      "localhost:26002",
@@ -166,7 +172,7 @@ func TestGossipManagerCanGossip(t *testing.T) {
 			Seed:             []string{"127.0.0.1:26001"},
 		},
 	}
-	m1, err := newGossipManager(nhid1, nil, nhConfig1)
+	m1, err := newGossipManager(nhid1, nil, nhConfig1, nil)
 	if err != nil {
 		t.Fatalf("gossip manager failed to start, %v", err)
 	}
@@ -175,7 +181,7 @@ func TestGossipManagerCanGossip(t *testing.T) {
 			t.Fatalf("failed to close gossip manager %v", err)
 		}
 	}()
-	m2, err := newGossipManager(nhid2, nil, nhConfig2)
+	m2, err := newGossipManager(nhid2, nil, nhConfig2, nil)
 	if err != nil {
 		t.Fatalf("gossip manager failed to start, %v", err)
 	}
@@ -203,3 +209,538 @@ func TestGossipManagerCanGossip(t *testing.T) {
 	}
 	t.Fatalf("failed to complete all queries")
 }
+
+func TestGossipManagerCanGossip(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testGossipManagerCanGossip(t, config.SocketConfig{})
+}
+
+func TestGossipManagerCanGossipWithSocketOptions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	socket := config.SocketConfig{
+		ReusePort:      true,
+		RecvBufferSize: 256 * 1024,
+		SendBufferSize: 256 * 1024,
+		AcceptBacklog:  128,
+	}
+	testGossipManagerCanGossip(t, socket)
+}
+
+func TestGossipManagerRequiresMatchingAuthToken(t *testing.T) {
+	tests := []struct {
+		token1 string
+		allow1 bool
+		token2 string
+		allow2 bool
+		joined bool
+	}{
+		{"secret", false, "secret", false, true},
+		{"secret", true, "", false, true},
+		{"secret", false, "other", false, false},
+		{"secret", false, "", false, false},
+	}
+	for idx, tt := range tests {
+		func() {
+			defer leaktest.AfterTest(t)()
+			nhConfig1 := config.NodeHostConfig{
+				RaftAddress:                   "localhost:27001",
+				TransportAuthToken:            tt.token1,
+				AllowUnauthenticatedTransport: tt.allow1,
+				Expert: config.ExpertConfig{
+					TestGossipProbeInterval: 10 * time.Millisecond,
+				},
+				Gossip: config.GossipConfig{
+					BindAddress:      "localhost:26001",
+					AdvertiseAddress: "127.0.0.1:26001",
+					Seed:             []string{"127.0.0.1:26002"},
+				},
+			}
+			nhConfig2 := config.NodeHostConfig{
+				RaftAddress:                   "localhost:27002",
+				TransportAuthToken:            tt.token2,
+				AllowUnauthenticatedTransport: tt.allow2,
+				Expert: config.ExpertConfig{
+					TestGossipProbeInterval: 10 * time.Millisecond,
+				},
+				Gossip: config.GossipConfig{
+					BindAddress:      "localhost:26002",
+					AdvertiseAddress: "127.0.0.1:26002",
+					Seed:             []string{"127.0.0.1:26001"},
+				},
+			}
+			m1, err := newGossipManager(testNodeHostID1, nil, nhConfig1, nil)
+			if err != nil {
+				t.Fatalf("gossip manager failed to start, %v", err)
+			}
+			defer func() {
+				if err := m1.Close(); err != nil {
+					t.Fatalf("failed to close gossip manager %v", err)
+				}
+			}()
+			m2, err := newGossipManager(testNodeHostID2, nil, nhConfig2, nil)
+			if err != nil {
+				t.Fatalf("gossip manager failed to start, %v", err)
+			}
+			defer func() {
+				if err := m2.Close(); err != nil {
+					t.Fatalf("failed to close gossip manager %v", err)
+				}
+			}()
+			joined := false
+			for i := 0; i < 200; i++ {
+				if m1.numMembers() == 2 && m2.numMembers() == 2 {
+					joined = true
+					break
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			if joined != tt.joined {
+				t.Errorf("%d, joined %t, want %t", idx, joined, tt.joined)
+			}
+		}()
+	}
+}
+
+func TestGossipTagsArePropagated(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	getConfig := func(raftPort int, port int, seed int,
+		tags map[string]string) config.NodeHostConfig {
+		return config.NodeHostConfig{
+			RaftAddress: fmt.Sprintf("localhost:%d", raftPort),
+			Expert: config.ExpertConfig{
+				TestGossipProbeInterval: 10 * time.Millisecond,
+			},
+			Gossip: config.GossipConfig{
+				BindAddress:      fmt.Sprintf("localhost:%d", port),
+				AdvertiseAddress: fmt.Sprintf("127.0.0.1:%d", port),
+				Seed:             []string{fmt.Sprintf("127.0.0.1:%d", seed)},
+				Tags:             tags,
+			},
+		}
+	}
+	m1, err := newGossipManager(testNodeHostID1, nil,
+		getConfig(27001, 26001, 26002, map[string]string{"zone": "a"}), nil)
+	if err != nil {
+		t.Fatalf("gossip manager failed to start, %v", err)
+	}
+	defer func() {
+		if err := m1.Close(); err != nil {
+			t.Fatalf("failed to close gossip manager %v", err)
+		}
+	}()
+	m2, err := newGossipManager(testNodeHostID2, nil,
+		getConfig(27002, 26002, 26001, nil), nil)
+	if err != nil {
+		t.Fatalf("gossip manager failed to start, %v", err)
+	}
+	defer func() {
+		if err := m2.Close(); err != nil {
+			t.Fatalf("failed to close gossip manager %v", err)
+		}
+	}()
+	waitForTags := func(zone string) {
+		for i := 0; i < 1000; i++ {
+			tags, ok := m2.GetNodeHostRegistry().GetNodeHostTags(testNodeHostID1)
+			if ok && tags["zone"] == zone {
+				nh, ok := m1.GetNodeHost(testNodeHostID1)
+				if !ok || nh.Tags["zone"] != zone {
+					t.Fatalf("unexpected local tags %v", nh.Tags)
+				}
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("tags not propagated")
+	}
+	waitForTags("a")
+	if err := m1.updateTags(map[string]string{"zone": "b"}); err != nil {
+		t.Fatalf("failed to update tags %v", err)
+	}
+	waitForTags("b")
+	big := map[string]string{"key": string(make([]byte, memberlist.MetaMaxSize))}
+	if err := m1.updateTags(big); err != ErrMetaTooBig {
+		t.Errorf("too big tags not rejected, %v", err)
+	}
+	waitForTags("b")
+}
+
+func TestDrainStateIsPropagated(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	getConfig := func(raftPort int, port int, seed int) config.NodeHostConfig {
+		return config.NodeHostConfig{
+			RaftAddress: fmt.Sprintf("localhost:%d", raftPort),
+			Expert: config.ExpertConfig{
+				TestGossipProbeInterval: 10 * time.Millisecond,
+			},
+			Gossip: config.GossipConfig{
+				BindAddress:      fmt.Sprintf("localhost:%d", port),
+				AdvertiseAddress: fmt.Sprintf("127.0.0.1:%d", port),
+				Seed:             []string{fmt.Sprintf("127.0.0.1:%d", seed)},
+			},
+		}
+	}
+	start := func(nhid string, cfg config.NodeHostConfig) *gossipManager {
+		m, err := newGossipManager(nhid, nil, cfg, nil)
+		if err != nil {
+			t.Fatalf("gossip manager failed to start, %v", err)
+		}
+		return m
+	}
+	stop := func(m *gossipManager) {
+		if err := m.Close(); err != nil {
+			t.Fatalf("failed to close gossip manager %v", err)
+		}
+	}
+	m1 := start(testNodeHostID1, getConfig(27041, 26041, 26042))
+	defer stop(m1)
+	m2 := start(testNodeHostID2, getConfig(27042, 26042, 26041))
+	defer stop(m2)
+	waitForDrainState := func(m *gossipManager, draining bool) {
+		for i := 0; i < 1000; i++ {
+			v, ok := m.GetNodeHostRegistry().IsNodeHostDraining(testNodeHostID1)
+			if ok && v == draining {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("drain state %t not propagated", draining)
+	}
+	waitForDrainState(m2, false)
+	if err := m1.setDraining(true); err != nil {
+		t.Fatalf("failed to set drain state %v", err)
+	}
+	nh, ok := m1.GetNodeHost(testNodeHostID1)
+	if !ok || !nh.Draining {
+		t.Errorf("local drain state not set")
+	}
+	waitForDrainState(m2, true)
+	// m3 joins after the update has been broadcasted, it learns the drain state
+	// from the full state sync
+	m3 := start("123e4567-e89b-12d3-a456-426614174002",
+		getConfig(27043, 26043, 26041))
+	defer stop(m3)
+	waitForDrainState(m3, true)
+	if err := m1.setDraining(false); err != nil {
+		t.Fatalf("failed to set drain state %v", err)
+	}
+	waitForDrainState(m2, false)
+	waitForDrainState(m3, false)
+}
+
+type testResolver struct {
+	mu    sync.Mutex
+	hosts map[string][]string
+}
+
+func (r *testResolver) set(host string, ips ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hosts == nil {
+		r.hosts = make(map[string][]string)
+	}
+	r.hosts[host] = ips
+}
+
+func (r *testResolver) LookupHost(ctx context.Context,
+	host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ips, ok := r.hosts[host]; ok && len(ips) > 0 {
+		return append([]string{}, ips...), nil
+	}
+	return nil, errors.New("no such host")
+}
+
+type testGossipEvent struct {
+	mu        sync.Mutex
+	isolated  int
+	rejoined  []int
+	suspected []string
+	recovered []string
+}
+
+func (e *testGossipEvent) GossipIsolated(addr string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.isolated++
+}
+
+func (e *testGossipEvent) GossipRejoined(addr string, members int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rejoined = append(e.rejoined, members)
+}
+
+func (e *testGossipEvent) NodeHostSuspected(nhid string, raftAddress string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.suspected = append(e.suspected, nhid)
+}
+
+func (e *testGossipEvent) NodeHostRecovered(nhid string, raftAddress string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.recovered = append(e.recovered, nhid)
+}
+
+func (e *testGossipEvent) getLiveness() ([]string, []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string{}, e.suspected...), append([]string{}, e.recovered...)
+}
+
+func (e *testGossipEvent) get() (int, []int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.isolated, append([]int{}, e.rejoined...)
+}
+
+func TestSeedsAreResolved(t *testing.T) {
+	r := &testResolver{}
+	r.set("seeds.test", "10.0.0.1", "10.0.0.2")
+	r.set("nh3.test", "10.0.0.2")
+	seed := []string{
+		"dns:///seeds.test:26001",
+		"nh3.test:26001",
+		"10.0.0.4:26001",
+		"dns:///missing.test:26001",
+	}
+	result, err := resolveSeeds(r, seed)
+	if err != nil {
+		t.Fatalf("failed to resolve seeds %v", err)
+	}
+	assert.Equal(t,
+		[]string{"10.0.0.1:26001", "10.0.0.2:26001", "10.0.0.4:26001"}, result)
+	r.set("seeds.test", "10.0.0.3")
+	result, err = resolveSeeds(r, seed[:1])
+	if err != nil {
+		t.Fatalf("failed to resolve seeds %v", err)
+	}
+	assert.Equal(t, []string{"10.0.0.3:26001"}, result)
+	if _, err := resolveSeeds(r, seed[3:]); err == nil {
+		t.Errorf("unresolved seeds not reported")
+	}
+}
+
+func getSeedTestConfig(port int, seed string,
+	r config.HostResolver) config.NodeHostConfig {
+	return config.NodeHostConfig{
+		RaftAddress: fmt.Sprintf("localhost:%d", port+1000),
+		Expert: config.ExpertConfig{
+			TestGossipProbeInterval: 10 * time.Millisecond,
+			GossipSeedResolver:      r,
+		},
+		Gossip: config.GossipConfig{
+			BindAddress:      fmt.Sprintf("localhost:%d", port),
+			AdvertiseAddress: fmt.Sprintf("127.0.0.1:%d", port),
+			Seed:             []string{seed},
+		},
+	}
+}
+
+func TestGossipJoinFailsWhenSeedsAreUnreachable(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	r := &testResolver{}
+	r.set("seeds.test", "127.0.0.1")
+	nhConfig := getSeedTestConfig(26011, "dns:///seeds.test:26019", r)
+	nhConfig.Gossip.JoinTimeout = 300 * time.Millisecond
+	if _, err := newGossipManager(testNodeHostID1,
+		nil, nhConfig, nil); !errors.Is(err, ErrJoinFailed) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	nhConfig.Gossip.ContinueOnJoinFailure = true
+	e := &testGossipEvent{}
+	m, err := newGossipManager(testNodeHostID1, nil, nhConfig, e)
+	if err != nil {
+		t.Fatalf("gossip manager failed to start, %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("failed to close gossip manager %v", err)
+	}
+	if isolated, _ := e.get(); isolated != 1 {
+		t.Errorf("unexpected isolated count %d", isolated)
+	}
+}
+
+func TestIsolatedGossipServiceRejoinsWhenSeedsChange(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	r := &testResolver{}
+	m1, err := newGossipManager(testNodeHostID1, nil,
+		getSeedTestConfig(26011, "127.0.0.1:26019", r), nil)
+	if err != nil {
+		t.Fatalf("gossip manager failed to start, %v", err)
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			if err := m1.Close(); err != nil {
+				t.Fatalf("failed to close gossip manager %v", err)
+			}
+		}
+	}()
+	nhConfig := getSeedTestConfig(26012, "dns:///seeds.test:26011", r)
+	nhConfig.Gossip.JoinTimeout = 100 * time.Millisecond
+	nhConfig.Gossip.ContinueOnJoinFailure = true
+	e := &testGossipEvent{}
+	m2, err := newGossipManager(testNodeHostID2, nil, nhConfig, e)
+	if err != nil {
+		t.Fatalf("gossip manager failed to start, %v", err)
+	}
+	defer func() {
+		if err := m2.Close(); err != nil {
+			t.Fatalf("failed to close gossip manager %v", err)
+		}
+	}()
+	waitFor := func(isolated int, rejoined int) {
+		for i := 0; i < 2000; i++ {
+			v1, v2 := e.get()
+			if v1 == isolated && len(v2) == rejoined {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		v1, v2 := e.get()
+		t.Fatalf("unexpected events, isolated %d, rejoined %v", v1, v2)
+	}
+	waitFor(1, 0)
+	r.set("seeds.test", "127.0.0.1")
+	waitFor(1, 1)
+	if _, v := e.get(); v[0] != 2 || m2.numMembers() != 2 {
+		t.Errorf("unexpected member count %v", v)
+	}
+	closed = true
+	if err := m1.Close(); err != nil {
+		t.Fatalf("failed to close gossip manager %v", err)
+	}
+	waitFor(2, 1)
+}
+
+func TestGossipKeyringOperations(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	key1 := []byte("0123456789abcdef")
+	key2 := []byte("fedcba9876543210")
+	nhConfig := getSeedTestConfig(26031, "127.0.0.1:26039", nil)
+	m, err := newGossipManager(testNodeHostID1, nil, nhConfig, nil)
+	if err != nil {
+		t.Fatalf("gossip manager failed to start, %v", err)
+	}
+	if err := m.addKey(key1); !errors.Is(err, ErrEncryptionDisabled) {
+		t.Errorf("unexpected error %v", err)
+	}
+	assert.Empty(t, m.keyFingerprints())
+	if err := m.Close(); err != nil {
+		t.Fatalf("failed to close gossip manager %v", err)
+	}
+	nhConfig.Gossip.Keys = [][]byte{key1}
+	m, err = newGossipManager(testNodeHostID1, nil, nhConfig, nil)
+	if err != nil {
+		t.Fatalf("gossip manager failed to start, %v", err)
+	}
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Fatalf("failed to close gossip manager %v", err)
+		}
+	}()
+	assert.Equal(t, []string{keyFingerprint(key1)}, m.keyFingerprints())
+	if err := m.addKey([]byte("short")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := m.useKey(key2); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := m.addKey(key2); err != nil {
+		t.Fatalf("failed to add key %v", err)
+	}
+	assert.Equal(t, []string{keyFingerprint(key1), keyFingerprint(key2)},
+		m.keyFingerprints())
+	if err := m.removeKey(key1); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := m.useKey(key2); err != nil {
+		t.Fatalf("failed to use key %v", err)
+	}
+	if err := m.removeKey(key1); err != nil {
+		t.Fatalf("failed to remove key %v", err)
+	}
+	assert.Equal(t, []string{keyFingerprint(key2)}, m.keyFingerprints())
+}
+
+func TestSuspectNodeHostIsNotResolved(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	nhConfig := getSeedTestConfig(26011, "127.0.0.1:26012", nil)
+	nhConfig.Gossip.SuspectGracePeriod = 100 * time.Millisecond
+	e := &testGossipEvent{}
+	r, err := NewGossipRegistry(testNodeHostID1,
+		nil, nhConfig, 1, id.IsNodeHostID, e)
+	if err != nil {
+		t.Fatalf("failed to create the registry, %v", err)
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			t.Fatalf("failed to close registry %v", err)
+		}
+	}()
+	startTarget := func() *gossipManager {
+		m, err := newGossipManager(testNodeHostID2, nil,
+			getSeedTestConfig(26012, "127.0.0.1:26011", nil), nil)
+		if err != nil {
+			t.Fatalf("gossip manager failed to start, %v", err)
+		}
+		return m
+	}
+	waitFor := func(f func() bool) bool {
+		for i := 0; i < 1000; i++ {
+			if f() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	m := startTarget()
+	r.Add(1, 2, testNodeHostID2)
+	if !waitFor(func() bool {
+		_, _, err := r.Resolve(1, 2)
+		return err == nil
+	}) {
+		t.Fatalf("target not resolved")
+	}
+	// crash the target without leaving the gossip group
+	m.stopper.Stop()
+	if err := m.list.Shutdown(); err != nil {
+		t.Fatalf("failed to shutdown memberlist %v", err)
+	}
+	if !waitFor(func() bool {
+		_, _, err := r.Resolve(1, 2)
+		return errors.Is(err, ErrNodeHostSuspect)
+	}) {
+		t.Fatalf("suspect target still resolved")
+	}
+	assert.NotEqual(t, NodeHostAlive, r.gossip.liveness.get(testNodeHostID2))
+	if !waitFor(func() bool {
+		suspected, _ := e.getLiveness()
+		return len(suspected) == 1
+	}) {
+		t.Fatalf("NodeHostSuspected not reported")
+	}
+	m = startTarget()
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Fatalf("failed to close gossip manager %v", err)
+		}
+	}()
+	if !waitFor(func() bool {
+		_, _, err := r.Resolve(1, 2)
+		return err == nil
+	}) {
+		t.Fatalf("recovered target not resolved")
+	}
+	if !waitFor(func() bool {
+		_, recovered := e.getLiveness()
+		return len(recovered) == 1
+	}) {
+		t.Fatalf("NodeHostRecovered not reported")
+	}
+	suspected, _ := e.getLiveness()
+	assert.Equal(t, []string{testNodeHostID2}, suspected)
+}
@@ -0,0 +1,213 @@
+// Copyright 2018-2020 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	sockaddr "github.com/hashicorp/go-sockaddr"
+	"github.com/hashicorp/memberlist"
+	"github.com/lni/goutils/syncutil"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/utils/sockopt"
+)
+
+const (
+	gossipPacketBufSize = 65536
+)
+
+// gossipTransport is the memberlist.Transport used by the gossip service when
+// socket options are configured. It listens on the same TCP and UDP port
+// pair as memberlist's default transport with the socket options applied.
+type gossipTransport struct {
+	packetCh chan *memberlist.Packet
+	streamCh chan net.Conn
+	ln       net.Listener
+	pc       net.PacketConn
+	socket   config.SocketConfig
+	stopper  *syncutil.Stopper
+	stopc    chan struct{}
+	closed   uint32
+}
+
+var _ memberlist.Transport = (*gossipTransport)(nil)
+
+func newGossipTransport(bindAddr string, bindPort int,
+	socket config.SocketConfig) (*gossipTransport, error) {
+	addr := net.JoinHostPort(bindAddr, strconv.Itoa(bindPort))
+	ln, err := sockopt.Listen(addr, socket)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := sockopt.ListenPacket(addr, socket)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	t := &gossipTransport{
+		packetCh: make(chan *memberlist.Packet),
+		streamCh: make(chan net.Conn),
+		ln:       ln,
+		pc:       pc,
+		socket:   socket,
+		stopper:  syncutil.NewStopper(),
+		stopc:    make(chan struct{}),
+	}
+	t.stopper.RunWorker(func() {
+		t.acceptMain()
+	})
+	t.stopper.RunWorker(func() {
+		t.packetMain()
+	})
+	return t, nil
+}
+
+// FinalAdvertiseAddr returns the address to be advertised to other members.
+func (t *gossipTransport) FinalAdvertiseAddr(ip string,
+	port int) (net.IP, int, error) {
+	if len(ip) > 0 {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return nil, 0, errors.Newf("invalid advertise address %s", ip)
+		}
+		if ip4 := addr.To4(); ip4 != nil {
+			addr = ip4
+		}
+		return addr, port, nil
+	}
+	tcpAddr := t.ln.Addr().(*net.TCPAddr)
+	if !tcpAddr.IP.IsUnspecified() {
+		return tcpAddr.IP, tcpAddr.Port, nil
+	}
+	pip, err := sockaddr.GetPrivateIP()
+	if err != nil {
+		return nil, 0, err
+	}
+	addr := net.ParseIP(pip)
+	if addr == nil {
+		return nil, 0, errors.New("no private IP address found")
+	}
+	return addr, tcpAddr.Port, nil
+}
+
+// WriteTo sends the packet to the specified address.
+func (t *gossipTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	_, err = t.pc.WriteTo(b, udpAddr)
+	return time.Now(), err
+}
+
+// PacketCh returns the channel of received packets.
+func (t *gossipTransport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+// DialTimeout creates a stream connection to the specified address.
+func (t *gossipTransport) DialTimeout(addr string,
+	timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if err := sockopt.SetConn(tc, t.socket); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// StreamCh returns the channel of accepted stream connections.
+func (t *gossipTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// Shutdown closes the listeners and waits for all workers to return.
+func (t *gossipTransport) Shutdown() error {
+	if !atomic.CompareAndSwapUint32(&t.closed, 0, 1) {
+		return nil
+	}
+	close(t.stopc)
+	err := errors.CombineErrors(t.ln.Close(), t.pc.Close())
+	t.stopper.Stop()
+	return err
+}
+
+func (t *gossipTransport) stopped() bool {
+	return atomic.LoadUint32(&t.closed) == 1
+}
+
+func (t *gossipTransport) acceptMain() {
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			if t.stopped() {
+				return
+			}
+			plog.Errorf("failed to accept gossip connection, %v", err)
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			if err := sockopt.SetConn(tc, t.socket); err != nil {
+				conn.Close()
+				continue
+			}
+		}
+		select {
+		case t.streamCh <- conn:
+		case <-t.stopc:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (t *gossipTransport) packetMain() {
+	for {
+		buf := make([]byte, gossipPacketBufSize)
+		n, addr, err := t.pc.ReadFrom(buf)
+		ts := time.Now()
+		if err != nil {
+			if t.stopped() {
+				return
+			}
+			plog.Errorf("failed to read gossip packet, %v", err)
+			continue
+		}
+		if n < 1 {
+			continue
+		}
+		select {
+		case t.packetCh <- &memberlist.Packet{
+			Buf:       buf[:n],
+			From:      addr,
+			Timestamp: ts,
+		}:
+		case <-t.stopc:
+			return
+		}
+	}
+}
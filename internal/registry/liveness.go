@@ -0,0 +1,243 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// deadNodeHostTTL is how long a dead NodeHost instance is remembered
+	deadNodeHostTTL = 10 * time.Minute
+	// interestTTL is how long a NodeHost instance is probed after the last
+	// time it was resolved as a message target
+	interestTTL = time.Minute
+)
+
+// NodeHostLiveness is the liveness of a NodeHost instance as observed by the
+// gossip service of the local NodeHost instance.
+type NodeHostLiveness uint8
+
+const (
+	// NodeHostUnknown means the liveness of the NodeHost instance is unknown.
+	NodeHostUnknown NodeHostLiveness = iota
+	// NodeHostAlive means the NodeHost instance is a live gossip member.
+	NodeHostAlive
+	// NodeHostSuspect means the NodeHost instance failed to respond to the
+	// latest gossip probe.
+	NodeHostSuspect
+	// NodeHostDead means the NodeHost instance has been declared as failed or
+	// it has left the gossip group.
+	NodeHostDead
+)
+
+func (l NodeHostLiveness) String() string {
+	switch l {
+	case NodeHostAlive:
+		return "alive"
+	case NodeHostSuspect:
+		return "suspect"
+	case NodeHostDead:
+		return "dead"
+	default:
+		return "unknown"
+	}
+}
+
+type nodeLiveness struct {
+	state       NodeHostLiveness
+	raftAddress string
+	// since is the time of the last state change
+	since time.Time
+	// acked is the last time the NodeHost responded to a probe
+	acked time.Time
+	// resolved is the last time the NodeHost was resolved as a message target
+	resolved time.Time
+	// reported indicates whether the NodeHost has been reported as suspect
+	reported bool
+}
+
+// livenessChange is a NodeHost instance reported as suspect or recovered.
+type livenessChange struct {
+	nhid        string
+	raftAddress string
+	recovered   bool
+}
+
+// liveness tracks the liveness of NodeHost instances. NodeHost instances are
+// considered as suspect or dead by the resolution path only after they have
+// been in such state for longer than the grace period, a zero grace period
+// disables such failure detection.
+type liveness struct {
+	mu    sync.Mutex
+	grace time.Duration
+	clock func() time.Time
+	nodes map[string]*nodeLiveness
+}
+
+func newLiveness(grace time.Duration) *liveness {
+	return &liveness{
+		grace: grace,
+		clock: time.Now,
+		nodes: make(map[string]*nodeLiveness),
+	}
+}
+
+func (l *liveness) enabled() bool {
+	return l.grace > 0
+}
+
+// must be called with l.mu held
+func (l *liveness) getNode(nhid string) *nodeLiveness {
+	n, ok := l.nodes[nhid]
+	if !ok {
+		n = &nodeLiveness{}
+		l.nodes[nhid] = n
+	}
+	return n
+}
+
+// must be called with l.mu held
+func (n *nodeLiveness) setState(state NodeHostLiveness, now time.Time) {
+	if n.state != state {
+		n.state = state
+		n.since = now
+	}
+}
+
+func (l *liveness) joined(nhid string, raftAddress string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock()
+	n := l.getNode(nhid)
+	n.raftAddress = raftAddress
+	n.acked = now
+	n.setState(NodeHostAlive, now)
+}
+
+func (l *liveness) left(nhid string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.getNode(nhid).setState(NodeHostDead, l.clock())
+}
+
+func (l *liveness) acked(nhid string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n, ok := l.nodes[nhid]
+	if !ok || n.state == NodeHostDead {
+		return
+	}
+	now := l.clock()
+	n.acked = now
+	n.setState(NodeHostAlive, now)
+}
+
+// probeFailed marks the NodeHost as suspect unless it responded to another
+// probe after the failed probe was started.
+func (l *liveness) probeFailed(nhid string, started time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n, ok := l.nodes[nhid]
+	if !ok || n.state != NodeHostAlive || n.acked.After(started) {
+		return
+	}
+	n.setState(NodeHostSuspect, l.clock())
+}
+
+func (l *liveness) get(nhid string) NodeHostLiveness {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n, ok := l.nodes[nhid]; ok {
+		return n.state
+	}
+	return NodeHostUnknown
+}
+
+// check is invoked when the specified NodeHost is resolved as a message
+// target. It returns ErrNodeHostSuspect when the NodeHost has been suspect or
+// dead for longer than the grace period.
+func (l *liveness) check(nhid string) error {
+	if !l.enabled() {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n, ok := l.nodes[nhid]
+	if !ok {
+		return nil
+	}
+	now := l.clock()
+	n.resolved = now
+	if l.failed(n, now) {
+		return ErrNodeHostSuspect
+	}
+	return nil
+}
+
+// must be called with l.mu held
+func (l *liveness) failed(n *nodeLiveness, now time.Time) bool {
+	return n.state != NodeHostAlive && now.Sub(n.since) >= l.grace
+}
+
+// toProbe returns NodeHost instances recently resolved as message targets
+// which haven't responded to any probe in the specified interval.
+func (l *liveness) toProbe(interval time.Duration) map[string]struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock()
+	result := make(map[string]struct{})
+	for nhid, n := range l.nodes {
+		if n.state == NodeHostDead || now.Sub(n.resolved) > interestTTL {
+			continue
+		}
+		if now.Sub(n.acked) >= interval {
+			result[nhid] = struct{}{}
+		}
+	}
+	return result
+}
+
+// changes returns NodeHost instances that just became failed or recovered
+// from the reported failure. Dead NodeHost instances are forgotten after
+// deadNodeHostTTL.
+func (l *liveness) changes() []livenessChange {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock()
+	var result []livenessChange
+	for nhid, n := range l.nodes {
+		if n.state == NodeHostDead && now.Sub(n.since) > deadNodeHostTTL {
+			delete(l.nodes, nhid)
+			continue
+		}
+		if !n.reported && l.failed(n, now) {
+			n.reported = true
+			result = append(result, livenessChange{
+				nhid:        nhid,
+				raftAddress: n.raftAddress,
+			})
+		} else if n.reported && n.state == NodeHostAlive {
+			n.reported = false
+			result = append(result, livenessChange{
+				nhid:        nhid,
+				raftAddress: n.raftAddress,
+				recovered:   true,
+			})
+		}
+	}
+	return result
+}
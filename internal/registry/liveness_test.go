@@ -0,0 +1,104 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLivenessRequiresGracePeriod(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newLiveness(time.Second)
+	l.clock = func() time.Time { return now }
+	assert.NoError(t, l.check("nh1"))
+	assert.Equal(t, NodeHostUnknown, l.get("nh1"))
+	l.joined("nh1", "localhost:9001")
+	assert.Equal(t, NodeHostAlive, l.get("nh1"))
+	now = now.Add(time.Second)
+	l.probeFailed("nh1", now)
+	assert.Equal(t, NodeHostSuspect, l.get("nh1"))
+	assert.NoError(t, l.check("nh1"))
+	assert.Empty(t, l.changes())
+	now = now.Add(time.Second)
+	assert.ErrorIs(t, l.check("nh1"), ErrNodeHostSuspect)
+	assert.Equal(t, []livenessChange{
+		{nhid: "nh1", raftAddress: "localhost:9001"},
+	}, l.changes())
+	assert.Empty(t, l.changes())
+	l.acked("nh1")
+	assert.NoError(t, l.check("nh1"))
+	assert.Equal(t, []livenessChange{
+		{nhid: "nh1", raftAddress: "localhost:9001", recovered: true},
+	}, l.changes())
+}
+
+func TestLivenessIgnoresStaleProbeFailure(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newLiveness(time.Second)
+	l.clock = func() time.Time { return now }
+	l.joined("nh1", "localhost:9001")
+	started := now
+	now = now.Add(time.Millisecond)
+	l.acked("nh1")
+	l.probeFailed("nh1", started)
+	assert.Equal(t, NodeHostAlive, l.get("nh1"))
+}
+
+func TestDeadNodeHostIsForgotten(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newLiveness(time.Second)
+	l.clock = func() time.Time { return now }
+	l.joined("nh1", "localhost:9001")
+	l.left("nh1")
+	l.acked("nh1")
+	assert.Equal(t, NodeHostDead, l.get("nh1"))
+	now = now.Add(time.Second)
+	assert.ErrorIs(t, l.check("nh1"), ErrNodeHostSuspect)
+	assert.Len(t, l.changes(), 1)
+	now = now.Add(deadNodeHostTTL + time.Second)
+	assert.Empty(t, l.changes())
+	assert.Equal(t, NodeHostUnknown, l.get("nh1"))
+	assert.NoError(t, l.check("nh1"))
+}
+
+func TestOnlyResolvedNodeHostsAreProbed(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newLiveness(time.Second)
+	l.clock = func() time.Time { return now }
+	l.joined("nh1", "localhost:9001")
+	l.joined("nh2", "localhost:9002")
+	l.joined("nh3", "localhost:9003")
+	assert.NoError(t, l.check("nh1"))
+	assert.NoError(t, l.check("nh3"))
+	l.left("nh3")
+	assert.Empty(t, l.toProbe(time.Second))
+	now = now.Add(time.Second)
+	assert.Equal(t, map[string]struct{}{"nh1": {}}, l.toProbe(time.Second))
+	now = now.Add(interestTTL + time.Second)
+	assert.Empty(t, l.toProbe(time.Second))
+}
+
+func TestDisabledLivenessNeverFailsResolution(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newLiveness(0)
+	l.clock = func() time.Time { return now }
+	l.joined("nh1", "localhost:9001")
+	l.left("nh1")
+	now = now.Add(time.Hour)
+	assert.NoError(t, l.check("nh1"))
+}
@@ -14,10 +14,16 @@
 
 package registry
 
+import (
+	"time"
+)
+
 // NodeHostRegistry is a NodeHost info registry backed by gossip.
 type NodeHostRegistry struct {
-	store *metaStore
-	view  *view
+	store    *metaStore
+	view     *view
+	liveness *liveness
+	watchers *watchers
 }
 
 // NumOfShards returns the number of shards known to the current NodeHost
@@ -36,20 +42,109 @@ func (r *NodeHostRegistry) GetMeta(nhID string) ([]byte, bool) {
 	return m.Data, true
 }
 
+// GetNodeHostTags returns tags of the specified NodeHost instance.
+func (r *NodeHostRegistry) GetNodeHostTags(nhID string) (map[string]string, bool) {
+	m, ok := r.store.get(nhID)
+	if !ok {
+		return nil, false
+	}
+	return copyTags(m.Tags), true
+}
+
+// IsNodeHostDraining returns a boolean value indicating whether the specified
+// NodeHost instance is advertised as draining.
+func (r *NodeHostRegistry) IsNodeHostDraining(nhID string) (bool, bool) {
+	m, ok := r.store.get(nhID)
+	if !ok {
+		return false, false
+	}
+	return m.Draining, true
+}
+
 // GetShardInfo returns the shard info for the specified shard if it is
 // available in the gossip view.
 func (r *NodeHostRegistry) GetShardInfo(shardID uint64) (ShardView, bool) {
-	r.view.mu.Lock()
-	defer r.view.mu.Unlock()
+	sv, _, ok := r.view.getShard(shardID)
+	return sv, ok
+}
 
-	ci, ok := r.view.mu.shards[shardID]
+// GetShardPlacement returns the placement of replicas of the specified shard
+// as known to the gossip view. The view is eventually consistent, it can lag
+// behind the actual membership and leadership of the shard by a few gossip
+// rounds.
+func (r *NodeHostRegistry) GetShardPlacement(shardID uint64) (ShardPlacement, bool) {
+	sv, updated, ok := r.view.getShard(shardID)
 	if !ok {
-		return ShardView{}, false
+		return ShardPlacement{}, false
+	}
+	return getShardPlacement(sv, updated, r.getRaftAddress, r.getLiveness), true
+}
+
+// ListShards returns placements of shards known to the gossip view that match
+// the specified filter, they are sorted by their shard IDs. The view is
+// eventually consistent, see GetShardPlacement for details.
+func (r *NodeHostRegistry) ListShards(filter ShardFilter) []ShardPlacement {
+	result := make([]ShardPlacement, 0)
+	for _, shardID := range r.view.shardIDs(filter.StartShardID) {
+		if filter.Limit > 0 && len(result) >= filter.Limit {
+			break
+		}
+		sv, updated, ok := r.view.getShard(shardID)
+		if !ok || !filter.matches(sv) {
+			continue
+		}
+		result = append(result,
+			getShardPlacement(sv, updated, r.getRaftAddress, r.getLiveness))
+	}
+	return result
+}
+
+func (r *NodeHostRegistry) getRaftAddress(nhID string) (string, bool) {
+	m, ok := r.store.get(nhID)
+	if !ok {
+		return "", false
+	}
+	return m.RaftAddress, true
+}
+
+func (r *NodeHostRegistry) getLiveness(nhID string) NodeHostLiveness {
+	return r.liveness.get(nhID)
+}
+
+// Watch returns a channel for receiving changes of the registry, it allows
+// external routing tables to be maintained without polling. The returned
+// function stops the watch and closes the channel.
+//
+// Delivery is best-effort. Events are buffered in the channel with the
+// specified buffer size, when the buffer is full, buffered events are dropped
+// and replaced by a Resync event, the watcher is expected to list the
+// current state of the registry again when it receives a Resync event.
+func (r *NodeHostRegistry) Watch(buffer int) (<-chan RegistryEvent, func()) {
+	return r.watchers.watch(buffer)
+}
+
+// shardsChanged is invoked by the view when views of some shards changed.
+func (r *NodeHostRegistry) shardsChanged(changes []shardChange, now time.Time) {
+	if !r.watchers.active() {
+		return
 	}
-	result := ci
-	result.Replicas = make(map[uint64]string)
-	for shardID, target := range ci.Replicas {
-		result.Replicas[shardID] = target
+	events := make([]RegistryEvent, 0, len(changes))
+	for _, c := range changes {
+		p := getShardPlacement(c.view, now, r.getRaftAddress, r.getLiveness)
+		if c.replicas {
+			events = append(events, RegistryEvent{
+				Type:  ShardReplicasChanged,
+				Time:  now,
+				Shard: p,
+			})
+		}
+		if c.leader {
+			events = append(events, RegistryEvent{
+				Type:  ShardLeaderChanged,
+				Time:  now,
+				Shard: p,
+			})
+		}
 	}
-	return result, true
+	r.watchers.publish(events...)
 }
@@ -0,0 +1,148 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"sort"
+	"time"
+)
+
+// ReplicaRole is the role of a replica in its Raft shard.
+type ReplicaRole uint8
+
+const (
+	// Voter is a regular voting replica.
+	Voter ReplicaRole = iota
+	// NonVoting is a non-voting replica.
+	NonVoting
+	// Witness is a witness replica without the actual log.
+	Witness
+)
+
+func (r ReplicaRole) String() string {
+	switch r {
+	case Voter:
+		return "voter"
+	case NonVoting:
+		return "non-voting"
+	case Witness:
+		return "witness"
+	default:
+		return "unknown"
+	}
+}
+
+// ReplicaPlacement describes where a replica of a Raft shard is located.
+type ReplicaPlacement struct {
+	// ReplicaID is the replica ID of the replica.
+	ReplicaID uint64
+	// NodeHostID is the NodeHostID of the NodeHost instance running the
+	// replica.
+	NodeHostID string
+	// RaftAddress is the RaftAddress of the NodeHost instance running the
+	// replica, it is empty when the NodeHost instance is not known.
+	RaftAddress string
+	// Role is the role of the replica.
+	Role ReplicaRole
+	// IsLeader indicates whether the replica is the leader of the shard as
+	// reported by the NodeHost instance with the highest known term.
+	IsLeader bool
+	// Liveness is the liveness of the NodeHost instance running the replica
+	// as observed by the local NodeHost instance.
+	Liveness NodeHostLiveness
+}
+
+// ShardPlacement describes where replicas of a Raft shard are located based
+// on the knowledge of the local NodeHost instance.
+type ShardPlacement struct {
+	// ShardID is the shard ID of the Raft shard.
+	ShardID uint64
+	// Replicas are replicas of the shard sorted by their replica IDs.
+	Replicas []ReplicaPlacement
+	// LeaderID is the replica ID of the last known leader, it is 0 when the
+	// leader is not known.
+	LeaderID uint64
+	// Term is the term of the last known leader.
+	Term uint64
+	// ConfigChangeIndex is the Raft Log index of the membership change entry
+	// backing the listed replicas.
+	ConfigChangeIndex uint64
+	// UpdatedAt is the last time the local NodeHost instance received an
+	// update of the shard, it is the zero time when not tracked.
+	UpdatedAt time.Time
+}
+
+// ShardFilter specifies the shards to be returned when listing known shards.
+// Large number of shards can be listed in pages by setting StartShardID to
+// the shard ID following the last shard ID returned in the previous page.
+type ShardFilter struct {
+	// StartShardID is the smallest shard ID to be returned.
+	StartShardID uint64
+	// Limit is the maximum number of shards to be returned, there is no limit
+	// when it is 0.
+	Limit int
+	// NodeHostID, when not empty, restricts the result to shards with at least
+	// one replica on the specified NodeHost instance.
+	NodeHostID string
+}
+
+func (f *ShardFilter) matches(sv ShardView) bool {
+	if len(f.NodeHostID) == 0 {
+		return true
+	}
+	for _, replicas := range []map[uint64]string{
+		sv.Replicas, sv.NonVotings, sv.Witnesses,
+	} {
+		for _, target := range replicas {
+			if target == f.NodeHostID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getShardPlacement(sv ShardView, updated time.Time,
+	resolve func(string) (string, bool),
+	liveness func(string) NodeHostLiveness) ShardPlacement {
+	result := ShardPlacement{
+		ShardID:           sv.ShardID,
+		Replicas:          make([]ReplicaPlacement, 0, len(sv.Replicas)),
+		LeaderID:          sv.LeaderID,
+		Term:              sv.Term,
+		ConfigChangeIndex: sv.ConfigChangeIndex,
+		UpdatedAt:         updated,
+	}
+	add := func(replicas map[uint64]string, role ReplicaRole) {
+		for replicaID, target := range replicas {
+			addr, _ := resolve(target)
+			result.Replicas = append(result.Replicas, ReplicaPlacement{
+				ReplicaID:   replicaID,
+				NodeHostID:  target,
+				RaftAddress: addr,
+				Role:        role,
+				IsLeader:    replicaID == sv.LeaderID,
+				Liveness:    liveness(target),
+			})
+		}
+	}
+	add(sv.Replicas, Voter)
+	add(sv.NonVotings, NonVoting)
+	add(sv.Witnesses, Witness)
+	sort.Slice(result.Replicas, func(i, j int) bool {
+		return result.Replicas[i].ReplicaID < result.Replicas[j].ReplicaID
+	})
+	return result
+}
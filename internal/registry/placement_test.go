@@ -0,0 +1,116 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestNodeHostRegistry() *NodeHostRegistry {
+	r := &NodeHostRegistry{
+		store:    &metaStore{},
+		view:     newView(0),
+		liveness: newLiveness(0),
+	}
+	r.store.put("nh1", meta{RaftAddress: "localhost:9001"})
+	r.store.put("nh2", meta{RaftAddress: "localhost:9002"})
+	r.liveness.joined("nh1", "localhost:9001")
+	r.liveness.joined("nh2", "localhost:9002")
+	r.liveness.left("nh2")
+	return r
+}
+
+func TestShardPlacement(t *testing.T) {
+	r := getTestNodeHostRegistry()
+	now := time.Unix(1000, 0)
+	r.view.clock = func() time.Time { return now }
+	if _, ok := r.GetShardPlacement(100); ok {
+		t.Errorf("unexpected placement")
+	}
+	r.view.update([]ShardView{
+		{
+			ShardID:           100,
+			ConfigChangeIndex: 10,
+			Replicas:          map[uint64]string{2: "nh2", 1: "nh1"},
+			NonVotings:        map[uint64]string{3: "nh3"},
+			Witnesses:         map[uint64]string{4: "nh1"},
+			LeaderID:          2,
+			Term:              5,
+		},
+	})
+	p, ok := r.GetShardPlacement(100)
+	assert.True(t, ok)
+	assert.Equal(t, ShardPlacement{
+		ShardID: 100,
+		Replicas: []ReplicaPlacement{
+			{ReplicaID: 1, NodeHostID: "nh1", RaftAddress: "localhost:9001",
+				Role: Voter, Liveness: NodeHostAlive},
+			{ReplicaID: 2, NodeHostID: "nh2", RaftAddress: "localhost:9002",
+				Role: Voter, IsLeader: true, Liveness: NodeHostDead},
+			{ReplicaID: 3, NodeHostID: "nh3", Role: NonVoting},
+			{ReplicaID: 4, NodeHostID: "nh1", RaftAddress: "localhost:9001",
+				Role: Witness, Liveness: NodeHostAlive},
+		},
+		LeaderID:          2,
+		Term:              5,
+		ConfigChangeIndex: 10,
+		UpdatedAt:         now,
+	}, p)
+	now = now.Add(time.Second)
+	r.view.update([]ShardView{{ShardID: 100, LeaderID: 1, Term: 6}})
+	p, ok = r.GetShardPlacement(100)
+	assert.True(t, ok)
+	assert.True(t, p.Replicas[0].IsLeader)
+	assert.False(t, p.Replicas[1].IsLeader)
+	assert.Equal(t, now, p.UpdatedAt)
+}
+
+func TestListShards(t *testing.T) {
+	r := getTestNodeHostRegistry()
+	updates := make([]ShardView, 0)
+	for shardID := uint64(1); shardID <= 10; shardID++ {
+		target := "nh1"
+		if shardID%2 == 0 {
+			target = "nh2"
+		}
+		updates = append(updates, ShardView{
+			ShardID:           shardID,
+			ConfigChangeIndex: 1,
+			Replicas:          map[uint64]string{1: target},
+		})
+	}
+	r.view.update(updates)
+	getIDs := func(l []ShardPlacement) []uint64 {
+		result := make([]uint64, 0)
+		for _, p := range l {
+			result = append(result, p.ShardID)
+		}
+		return result
+	}
+	assert.Equal(t, 10, len(r.ListShards(ShardFilter{})))
+	assert.Equal(t, []uint64{1, 2, 3, 4},
+		getIDs(r.ListShards(ShardFilter{Limit: 4})))
+	assert.Equal(t, []uint64{5, 6, 7, 8},
+		getIDs(r.ListShards(ShardFilter{StartShardID: 5, Limit: 4})))
+	assert.Equal(t, []uint64{9, 10},
+		getIDs(r.ListShards(ShardFilter{StartShardID: 9, Limit: 4})))
+	assert.Empty(t, r.ListShards(ShardFilter{StartShardID: 11}))
+	assert.Equal(t, []uint64{4, 6, 8},
+		getIDs(r.ListShards(ShardFilter{StartShardID: 3, Limit: 3, NodeHostID: "nh2"})))
+	assert.Empty(t, r.ListShards(ShardFilter{NodeHostID: "nh3"}))
+}
@@ -30,6 +30,22 @@ var (
 	// ErrUnknownTarget is the error returned when the target address of the node
 	// is unknown.
 	ErrUnknownTarget = errors.New("target address unknown")
+	// ErrMetaTooBig is the error returned when the metadata of the NodeHost
+	// is too big to be included in gossip messages.
+	ErrMetaTooBig = errors.New("gossip meta is too big")
+	// ErrJoinFailed is the error returned when the gossip group can not be
+	// joined within the time budget specified by GossipConfig.JoinTimeout.
+	ErrJoinFailed = errors.New("failed to join the gossip group")
+	// ErrEncryptionDisabled is the error returned when changing the keyring of
+	// a gossip service that doesn't encrypt its messages.
+	ErrEncryptionDisabled = errors.New("gossip encryption disabled")
+	// ErrInvalidKey is the error returned when the specified gossip key is
+	// invalid or can not be used for the requested keyring operation.
+	ErrInvalidKey = errors.New("invalid gossip key")
+	// ErrNodeHostSuspect is the error returned when the target NodeHost has
+	// been suspected as failed by the gossip service for longer than the
+	// configured grace period.
+	ErrNodeHostSuspect = errors.New("target NodeHost suspected as failed")
 )
 
 // IResolver converts the (shard id, replica id) tuple to network address.
@@ -0,0 +1,310 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/lni/goutils/syncutil"
+	"gopkg.in/yaml.v3"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+)
+
+var (
+	// ErrInvalidRegistryFile indicates that the file of the static registry
+	// can not be parsed or contains invalid mappings.
+	ErrInvalidRegistryFile = errors.New("invalid static registry file")
+)
+
+// staticFile is the content of the static registry file.
+type staticFile struct {
+	NodeHosts []staticNodeHost `json:"nodehosts" yaml:"nodehosts"`
+}
+
+type staticNodeHost struct {
+	NodeHostID  string            `json:"nodehost_id" yaml:"nodehost_id"`
+	RaftAddress string            `json:"raft_address" yaml:"raft_address"`
+	Meta        string            `json:"meta,omitempty" yaml:"meta,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
+}
+
+// parseStaticFile parses the content of the static registry file into a
+// NodeHostID to meta map.
+func parseStaticFile(fn string, data []byte,
+	validate config.RaftAddressValidator) (map[string]meta, error) {
+	var sf staticFile
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &sf); err != nil {
+			return nil, errors.Wrapf(ErrInvalidRegistryFile, "%v", err)
+		}
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&sf); err != nil {
+			return nil, errors.Wrapf(ErrInvalidRegistryFile, "%v", err)
+		}
+	}
+	result := make(map[string]meta, len(sf.NodeHosts))
+	for _, nh := range sf.NodeHosts {
+		if len(nh.NodeHostID) == 0 {
+			return nil, errors.Wrapf(ErrInvalidRegistryFile, "empty nodehost_id")
+		}
+		if validate != nil && !validate(nh.RaftAddress) {
+			return nil, errors.Wrapf(ErrInvalidRegistryFile,
+				"invalid raft_address %s for %s", nh.RaftAddress, nh.NodeHostID)
+		}
+		if _, ok := result[nh.NodeHostID]; ok {
+			return nil, errors.Wrapf(ErrInvalidRegistryFile,
+				"duplicated nodehost_id %s", nh.NodeHostID)
+		}
+		m := meta{RaftAddress: nh.RaftAddress, Tags: nh.Tags}
+		if len(nh.Meta) > 0 {
+			m.Data = []byte(nh.Meta)
+		}
+		result[nh.NodeHostID] = m
+	}
+	return result, nil
+}
+
+// StaticRegistry is a node registry backed by a file containing NodeHostID to
+// RaftAddress mappings. Similar to the GossipRegistry, it supports NodeHosts
+// with dynamic RaftAddress values, addresses are updated by changing the file
+// and reloading it.
+type StaticRegistry struct {
+	nodes       *Registry
+	fs          vfs.IFS
+	fn          string
+	nhid        string
+	raftAddress string
+	validate    config.RaftAddressValidator
+	stopper     *syncutil.Stopper
+	// reloadMu serializes reloads.
+	reloadMu sync.Mutex
+	modTime  time.Time
+	size     int64
+	mu       struct {
+		sync.RWMutex
+		nodeHosts map[string]meta
+	}
+}
+
+var _ raftio.INodeRegistry = (*StaticRegistry)(nil)
+var _ IResolver = (*StaticRegistry)(nil)
+
+// NewStaticRegistry creates a new StaticRegistry instance. The file specified
+// by nhConfig.StaticRegistry.File is loaded before the registry is returned.
+func NewStaticRegistry(nhid string, nhConfig config.NodeHostConfig,
+	streamConnections uint64, v config.TargetValidator) (*StaticRegistry, error) {
+	fs := nhConfig.Expert.FS
+	if fs == nil {
+		fs = vfs.DefaultFS
+	}
+	r := &StaticRegistry{
+		nodes:       NewNodeRegistry(streamConnections, v),
+		fs:          fs,
+		fn:          nhConfig.StaticRegistry.File,
+		nhid:        nhid,
+		raftAddress: nhConfig.RaftAddress,
+		validate:    nhConfig.GetRaftAddressValidator(),
+		stopper:     syncutil.NewStopper(),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	if interval := nhConfig.StaticRegistry.ReloadInterval; interval > 0 {
+		r.stopper.RunWorker(func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if _, err := r.reloadIfChanged(); err != nil {
+						plog.Warningf("failed to reload %s, %v", r.fn, err)
+					}
+				case <-r.stopper.ShouldStop():
+					return
+				}
+			}
+		})
+	}
+	return r, nil
+}
+
+// Close closes the StaticRegistry instance.
+func (r *StaticRegistry) Close() error {
+	r.stopper.Stop()
+	return nil
+}
+
+// Reload reloads the registry file and atomically replaces all known
+// mappings. Existing mappings are kept when the file can not be loaded.
+func (r *StaticRegistry) Reload() error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+	fi, err := r.fs.Stat(r.fn)
+	if err != nil {
+		return err
+	}
+	return r.load(fi.ModTime(), fi.Size())
+}
+
+// reloadIfChanged reloads the registry file when its modification time or
+// size changed since it was last loaded.
+func (r *StaticRegistry) reloadIfChanged() (bool, error) {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+	fi, err := r.fs.Stat(r.fn)
+	if err != nil {
+		return false, err
+	}
+	if fi.ModTime().Equal(r.modTime) && fi.Size() == r.size {
+		return false, nil
+	}
+	return true, r.load(fi.ModTime(), fi.Size())
+}
+
+func (r *StaticRegistry) load(modTime time.Time, size int64) error {
+	f, err := r.fs.Open(r.fn)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	nodeHosts, err := parseStaticFile(r.fn, data, r.validate)
+	if err != nil {
+		return err
+	}
+	r.modTime = modTime
+	r.size = size
+	r.mu.Lock()
+	r.mu.nodeHosts = nodeHosts
+	r.mu.Unlock()
+	plog.Infof("static registry loaded from %s, %d NodeHost(s)",
+		r.fn, len(nodeHosts))
+	return nil
+}
+
+func (r *StaticRegistry) get(nhid string) (meta, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m, ok := r.mu.nodeHosts[nhid]
+	return m, ok
+}
+
+// Add adds a new node with its known NodeHostID to the registry.
+func (r *StaticRegistry) Add(shardID uint64,
+	replicaID uint64, target string) {
+	r.nodes.Add(shardID, replicaID, target)
+}
+
+// Remove removes the specified node from the registry.
+func (r *StaticRegistry) Remove(shardID uint64, replicaID uint64) {
+	r.nodes.Remove(shardID, replicaID)
+}
+
+// RemoveShard removes the specified shard from the registry.
+func (r *StaticRegistry) RemoveShard(shardID uint64) {
+	r.nodes.RemoveShard(shardID)
+}
+
+// Resolve returns the current RaftAddress and connection key of the specified
+// node. It returns ErrUnknownTarget when the RaftAddress is unknown.
+func (r *StaticRegistry) Resolve(shardID uint64,
+	replicaID uint64) (string, string, error) {
+	target, key, err := r.nodes.Resolve(shardID, replicaID)
+	if err != nil {
+		return "", "", err
+	}
+	if m, ok := r.get(target); ok {
+		return m.RaftAddress, key, nil
+	}
+	if target == r.nhid {
+		return r.raftAddress, key, nil
+	}
+	return "", "", ErrUnknownTarget
+}
+
+// NumOfShards always returns 0 as shard info is not shared between NodeHost
+// instances without the gossip service.
+func (r *StaticRegistry) NumOfShards() int {
+	return 0
+}
+
+// GetMeta returns the metadata of the specified NodeHost instance as listed
+// in the registry file.
+func (r *StaticRegistry) GetMeta(nhID string) ([]byte, bool) {
+	m, ok := r.get(nhID)
+	if !ok {
+		return nil, false
+	}
+	return m.Data, true
+}
+
+// GetNodeHostTags returns tags of the specified NodeHost instance as listed
+// in the registry file.
+func (r *StaticRegistry) GetNodeHostTags(nhID string) (map[string]string, bool) {
+	m, ok := r.get(nhID)
+	if !ok {
+		return nil, false
+	}
+	return copyTags(m.Tags), true
+}
+
+// IsNodeHostDraining always reports listed NodeHost instances as not draining
+// as the drain state can not be published without the gossip service.
+func (r *StaticRegistry) IsNodeHostDraining(nhID string) (bool, bool) {
+	_, ok := r.get(nhID)
+	return false, ok
+}
+
+// GetShardInfo always returns false as shard info is not shared between
+// NodeHost instances without the gossip service.
+func (r *StaticRegistry) GetShardInfo(shardID uint64) (ShardView, bool) {
+	return ShardView{}, false
+}
+
+// GetShardPlacement always returns false as shard info is not shared between
+// NodeHost instances without the gossip service.
+func (r *StaticRegistry) GetShardPlacement(shardID uint64) (ShardPlacement, bool) {
+	return ShardPlacement{}, false
+}
+
+// ListShards always returns nil as shard info is not shared between NodeHost
+// instances without the gossip service.
+func (r *StaticRegistry) ListShards(filter ShardFilter) []ShardPlacement {
+	return nil
+}
+
+// Watch returns a channel that never receives any event as the static
+// registry doesn't change.
+func (r *StaticRegistry) Watch(buffer int) (<-chan RegistryEvent, func()) {
+	return idleWatch(buffer)
+}
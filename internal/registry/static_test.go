@@ -0,0 +1,222 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/lni/goutils/leaktest"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/id"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+func writeStaticFile(t *testing.T, fs vfs.IFS, fn string, content string) {
+	f, err := fs.Create(fn)
+	if err != nil {
+		t.Fatalf("failed to create file %v", err)
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatalf("failed to write file %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close file %v", err)
+	}
+}
+
+func getStaticTestConfig(fs vfs.IFS, fn string) config.NodeHostConfig {
+	return config.NodeHostConfig{
+		RaftAddress:    "localhost:27001",
+		StaticRegistry: config.StaticRegistryConfig{File: fn},
+		Expert:         config.ExpertConfig{FS: fs},
+	}
+}
+
+func TestStaticFileCanBeParsed(t *testing.T) {
+	json := `{"nodehosts": [
+		{"nodehost_id": "` + testNodeHostID1 + `", "raft_address": "localhost:27001"},
+		{"nodehost_id": "` + testNodeHostID2 + `", "raft_address": "localhost:27002", "meta": "rack-2",
+			"tags": {"zone": "b"}}
+	]}`
+	yaml := `
+nodehosts:
+  - nodehost_id: ` + testNodeHostID1 + `
+    raft_address: localhost:27001
+  - nodehost_id: ` + testNodeHostID2 + `
+    raft_address: localhost:27002
+    meta: rack-2
+    tags:
+      zone: b
+`
+	for _, tt := range []struct {
+		fn      string
+		content string
+	}{
+		{"registry.json", json},
+		{"registry.yaml", yaml},
+		{"registry.yml", yaml},
+	} {
+		nhs, err := parseStaticFile(tt.fn, []byte(tt.content), nil)
+		if err != nil {
+			t.Fatalf("%s, failed to parse %v", tt.fn, err)
+		}
+		if len(nhs) != 2 {
+			t.Fatalf("%s, unexpected result %v", tt.fn, nhs)
+		}
+		if m := nhs[testNodeHostID1]; m.RaftAddress != "localhost:27001" || m.Data != nil {
+			t.Errorf("%s, unexpected meta %+v", tt.fn, m)
+		}
+		if m := nhs[testNodeHostID2]; m.RaftAddress != "localhost:27002" ||
+			string(m.Data) != "rack-2" || m.Tags["zone"] != "b" {
+			t.Errorf("%s, unexpected meta %+v", tt.fn, m)
+		}
+	}
+}
+
+func TestInvalidStaticFileIsRejected(t *testing.T) {
+	tests := []string{
+		`{"nodehosts": [`,
+		`{"nodehosts": [{"raft_address": "localhost:27001"}]}`,
+		`{"nodehosts": [{"nodehost_id": "nh1", "raft_address": "localhost"}]}`,
+		`{"nodehosts": [{"nodehost_id": "nh1", "raft_address": "localhost:1"},
+			{"nodehost_id": "nh1", "raft_address": "localhost:2"}]}`,
+		`{"nodehosts": [{"nodehost_id": "nh1", "address": "localhost:1"}]}`,
+	}
+	for idx, tt := range tests {
+		_, err := parseStaticFile("registry.json", []byte(tt),
+			config.IsValidAddress)
+		if !errors.Is(err, ErrInvalidRegistryFile) {
+			t.Errorf("%d, invalid file not rejected, %v", idx, err)
+		}
+	}
+}
+
+func TestStaticRegistry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.GetTestFS()
+	fn := fs.PathJoin(t.TempDir(), "registry.json")
+	writeStaticFile(t, fs, fn, `{"nodehosts": [
+		{"nodehost_id": "`+testNodeHostID2+`", "raft_address": "localhost:27002", "meta": "rack-2"}
+	]}`)
+	nhConfig := getStaticTestConfig(fs, fn)
+	r, err := NewStaticRegistry(testNodeHostID1, nhConfig, 1, id.IsNodeHostID)
+	if err != nil {
+		t.Fatalf("failed to create the registry, %v", err)
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			t.Fatalf("failed to close registry %v", err)
+		}
+	}()
+	r.Add(123, 1, testNodeHostID1)
+	r.Add(123, 2, testNodeHostID2)
+	addr, _, err := r.Resolve(123, 1)
+	if err != nil || addr != nhConfig.RaftAddress {
+		t.Errorf("unexpected addr %s, %v", addr, err)
+	}
+	addr, _, err = r.Resolve(123, 2)
+	if err != nil || addr != "localhost:27002" {
+		t.Errorf("unexpected addr %s, %v", addr, err)
+	}
+	if v, ok := r.GetMeta(testNodeHostID2); !ok || string(v) != "rack-2" {
+		t.Errorf("unexpected meta %s", v)
+	}
+	nhid3 := "123e4567-e89b-12d3-a456-426614174002"
+	r.Add(123, 3, nhid3)
+	if _, _, err = r.Resolve(123, 3); err != ErrUnknownTarget {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, _, err = r.Resolve(123, 4); err != ErrUnknownTarget {
+		t.Errorf("unexpected error %v", err)
+	}
+	r.RemoveShard(123)
+	if _, _, err = r.Resolve(123, 2); err != ErrUnknownTarget {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestStaticRegistryKeepsMappingsOnFailedReload(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.GetTestFS()
+	fn := fs.PathJoin(t.TempDir(), "registry.json")
+	if _, err := NewStaticRegistry(testNodeHostID1,
+		getStaticTestConfig(fs, fn), 1, id.IsNodeHostID); err == nil {
+		t.Fatalf("registry created without the file")
+	}
+	writeStaticFile(t, fs, fn, `{"nodehosts": [
+		{"nodehost_id": "`+testNodeHostID2+`", "raft_address": "localhost:27002"}
+	]}`)
+	r, err := NewStaticRegistry(testNodeHostID1,
+		getStaticTestConfig(fs, fn), 1, id.IsNodeHostID)
+	if err != nil {
+		t.Fatalf("failed to create the registry, %v", err)
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			t.Fatalf("failed to close registry %v", err)
+		}
+	}()
+	r.Add(123, 2, testNodeHostID2)
+	writeStaticFile(t, fs, fn, `{"nodehosts": [`)
+	if err := r.Reload(); !errors.Is(err, ErrInvalidRegistryFile) {
+		t.Errorf("unexpected error %v", err)
+	}
+	addr, _, err := r.Resolve(123, 2)
+	if err != nil || addr != "localhost:27002" {
+		t.Errorf("unexpected addr %s, %v", addr, err)
+	}
+}
+
+func TestStaticRegistryReloadsChangedFile(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.GetTestFS()
+	fn := fs.PathJoin(t.TempDir(), "registry.yaml")
+	writeStaticFile(t, fs, fn, `
+nodehosts:
+  - nodehost_id: `+testNodeHostID2+`
+    raft_address: localhost:27002
+`)
+	nhConfig := getStaticTestConfig(fs, fn)
+	nhConfig.StaticRegistry.ReloadInterval = 5 * time.Millisecond
+	r, err := NewStaticRegistry(testNodeHostID1, nhConfig, 1, id.IsNodeHostID)
+	if err != nil {
+		t.Fatalf("failed to create the registry, %v", err)
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			t.Fatalf("failed to close registry %v", err)
+		}
+	}()
+	r.Add(123, 2, testNodeHostID2)
+	writeStaticFile(t, fs, fn, `
+nodehosts:
+  - nodehost_id: `+testNodeHostID2+`
+    raft_address: localhost:27012
+`)
+	for i := 0; i < 1000; i++ {
+		addr, _, err := r.Resolve(123, 2)
+		if err != nil {
+			t.Fatalf("failed to resolve %v", err)
+		}
+		if addr == "localhost:27012" {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("changed file not reloaded")
+}
@@ -19,11 +19,14 @@ import (
 	"encoding/binary"
 	"encoding/gob"
 	"math/rand"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/pierrec/lz4/v4"
 
 	"github.com/lni/dragonboat/v4/internal/raft"
+	"github.com/lni/dragonboat/v4/raftio"
 	sm "github.com/lni/dragonboat/v4/statemachine"
 )
 
@@ -36,6 +39,12 @@ var (
 type ShardInfo struct {
 	// Replicas is a map of member replica IDs to their Raft addresses.
 	Replicas map[uint64]string
+	// NonVotings is a map of non-voting member replica IDs to their Raft
+	// addresses.
+	NonVotings map[uint64]string
+	// Witnesses is a map of witness member replica IDs to their Raft
+	// addresses.
+	Witnesses map[uint64]string
 	// ShardID is the shard ID of the Raft shard.
 	ShardID uint64
 	// ReplicaID is the replica ID of the Raft replica.
@@ -57,21 +66,53 @@ type ShardInfo struct {
 	IsNonVoting bool
 	// IsWitness indicates whether this is a witness node without actual log.
 	IsWitness bool
+	// IsStandby indicates whether this is a warm standby replica not yet
+	// activated, see NodeHost.ActivateStandby.
+	IsStandby bool
+	// IsFrozen indicates whether this is a frozen replica with its runtime
+	// resources released, see NodeHost.FreezeShard. Leader info is not
+	// available for frozen replicas.
+	IsFrozen bool
+	// IsRemoved indicates whether the replica has been removed from the shard.
+	// Such replica is unloaded by the NodeHost, it is reported until stopped
+	// using NodeHost.StopReplica or having its data removed using
+	// NodeHost.RemoveData.
+	IsRemoved bool
 	// Pending is a boolean flag indicating whether details of the shard node
 	// is not available. The Pending flag is set to true usually because the node
 	// has not had anything applied yet.
 	Pending bool
+	// ReceivingSnapshot indicates whether a snapshot is currently being
+	// received from a remote replica.
+	ReceivingSnapshot bool
+	// SnapshotPercentComplete is the estimated progress of the snapshot being
+	// received, it is 0 when the total size of the snapshot is not known,
+	// e.g. when the snapshot is streamed.
+	SnapshotPercentComplete uint64
+	// ApplyLag is the number of committed entries not yet applied by the state
+	// machine as observed on the most recent tick.
+	ApplyLag uint64
+	// ApplyStallDuration is the amount of time since the applied index last
+	// advanced while there are committed entries to apply, it is 0 when the
+	// state machine is keeping up.
+	ApplyStallDuration time.Duration
+	// Quiesced indicates whether the replica is currently in quiesce mode.
+	Quiesced bool
+	// RetainedSnapshots is the number of snapshots of the replica kept on disk,
+	// including the latest one, see config.Config.SnapshotsToKeep.
+	RetainedSnapshots uint64
+	// RetainedSnapshotSize is the total size in bytes of snapshots of the
+	// replica kept on disk.
+	RetainedSnapshotSize uint64
+	// SnapshotQueuePosition is the position of the replica in the queue of
+	// replicas waiting to save or recover snapshots, it is 0 when the replica
+	// is not waiting. See config.ExpertConfig.MaxConcurrentSnapshots.
+	SnapshotQueuePosition uint64
 }
 
 // ShardView is the view of a shard from gossip's point of view at a certain
 // point in time.
-type ShardView struct {
-	ShardID           uint64
-	Replicas          map[uint64]string
-	ConfigChangeIndex uint64
-	LeaderID          uint64
-	Term              uint64
-}
+type ShardView = raftio.ShardView
 
 func toShardViewList(input []ShardInfo) []ShardView {
 	result := make([]ShardView, 0)
@@ -79,6 +120,8 @@ func toShardViewList(input []ShardInfo) []ShardView {
 		cv := ShardView{
 			ShardID:           ci.ShardID,
 			Replicas:          ci.Replicas,
+			NonVotings:        ci.NonVotings,
+			Witnesses:         ci.Witnesses,
 			ConfigChangeIndex: ci.ConfigChangeIndex,
 			LeaderID:          ci.LeaderID,
 			Term:              ci.Term,
@@ -97,18 +140,26 @@ type exchanged struct {
 // election or a raft configuration change.
 type view struct {
 	deploymentID uint64
+	clock        func() time.Time
+	// onChange, when set, is invoked with the view locked after views of some
+	// shards changed
+	onChange func(changes []shardChange, now time.Time)
 	// shardID -> ShardView
 	mu struct {
 		sync.Mutex
 		shards map[uint64]ShardView
+		// shardID -> the last time the ShardView was updated
+		updated map[uint64]time.Time
 	}
 }
 
 func newView(deploymentID uint64) *view {
 	v := &view{
 		deploymentID: deploymentID,
+		clock:        time.Now,
 	}
 	v.mu.shards = make(map[uint64]ShardView)
+	v.mu.updated = make(map[uint64]time.Time)
 	return v
 }
 
@@ -121,6 +172,8 @@ func (v *view) shardCount() int {
 func mergeShardView(current ShardView, update ShardView) ShardView {
 	if current.ConfigChangeIndex < update.ConfigChangeIndex {
 		current.Replicas = update.Replicas
+		current.NonVotings = update.NonVotings
+		current.Witnesses = update.Witnesses
 		current.ConfigChangeIndex = update.ConfigChangeIndex
 	}
 	// we only keep which replica is the last known leader
@@ -134,17 +187,92 @@ func mergeShardView(current ShardView, update ShardView) ShardView {
 	return current
 }
 
+func copyReplicas(replicas map[uint64]string) map[uint64]string {
+	if replicas == nil {
+		return nil
+	}
+	result := make(map[uint64]string, len(replicas))
+	for replicaID, target := range replicas {
+		result[replicaID] = target
+	}
+	return result
+}
+
+func copyShardView(sv ShardView) ShardView {
+	sv.Replicas = copyReplicas(sv.Replicas)
+	if sv.Replicas == nil {
+		sv.Replicas = make(map[uint64]string)
+	}
+	sv.NonVotings = copyReplicas(sv.NonVotings)
+	sv.Witnesses = copyReplicas(sv.Witnesses)
+	return sv
+}
+
+// shardChange describes how the view of a shard changed.
+type shardChange struct {
+	view     ShardView
+	replicas bool
+	leader   bool
+}
+
 func (v *view) update(updates []ShardView) {
 	v.mu.Lock()
 	defer v.mu.Unlock()
 
+	now := v.clock()
+	var changes []shardChange
 	for _, u := range updates {
 		current, ok := v.mu.shards[u.ShardID]
 		if !ok {
 			current = ShardView{ShardID: u.ShardID}
 		}
-		v.mu.shards[u.ShardID] = mergeShardView(current, u)
+		merged := mergeShardView(current, u)
+		v.mu.shards[u.ShardID] = merged
+		v.mu.updated[u.ShardID] = now
+		if v.onChange == nil {
+			continue
+		}
+		c := shardChange{
+			replicas: !ok || merged.ConfigChangeIndex != current.ConfigChangeIndex,
+			leader:   merged.LeaderID != current.LeaderID,
+		}
+		if c.replicas || c.leader {
+			c.view = copyShardView(merged)
+			changes = append(changes, c)
+		}
+	}
+	if len(changes) > 0 {
+		v.onChange(changes, now)
+	}
+}
+
+// getShard returns a copy of the view of the specified shard together with
+// the last time it was updated.
+func (v *view) getShard(shardID uint64) (ShardView, time.Time, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	sv, ok := v.mu.shards[shardID]
+	if !ok {
+		return ShardView{}, time.Time{}, false
 	}
+	return copyShardView(sv), v.mu.updated[shardID], true
+}
+
+// shardIDs returns IDs of known shards that are equal to or greater than the
+// specified start shard ID in ascending order.
+func (v *view) shardIDs(start uint64) []uint64 {
+	result := make([]uint64, 0)
+	func() {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		for shardID := range v.mu.shards {
+			if shardID >= start {
+				result = append(result, shardID)
+			}
+		}
+	}()
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
 }
 
 func (v *view) toShuffledList() []ShardView {
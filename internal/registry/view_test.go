@@ -52,7 +52,7 @@ func TestGetFullSyncData(t *testing.T) {
 
 	v2 := newView(123)
 	v2.updateFrom(data)
-	assert.Equal(t, v, v2)
+	assert.Equal(t, v.mu.shards, v2.mu.shards)
 }
 
 func TestConfigChangeIndexIsChecked(t *testing.T) {
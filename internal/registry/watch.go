@@ -0,0 +1,166 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"sync"
+	"time"
+)
+
+// RegistryEventType is the type of a RegistryEvent.
+type RegistryEventType uint8
+
+const (
+	// Resync means that events have been dropped as the watcher couldn't keep
+	// up, the watcher should list the current state of the registry again.
+	Resync RegistryEventType = iota
+	// NodeHostJoined means that a NodeHost instance became known.
+	NodeHostJoined
+	// NodeHostLeft means that a NodeHost instance left or failed.
+	NodeHostLeft
+	// NodeHostAddressChanged means that the RaftAddress of a known NodeHost
+	// instance changed.
+	NodeHostAddressChanged
+	// ShardReplicasChanged means that a shard became known or its known
+	// replica set changed.
+	ShardReplicasChanged
+	// ShardLeaderChanged means that the believed leader of a shard changed.
+	ShardLeaderChanged
+)
+
+func (t RegistryEventType) String() string {
+	switch t {
+	case Resync:
+		return "resync"
+	case NodeHostJoined:
+		return "nodehost-joined"
+	case NodeHostLeft:
+		return "nodehost-left"
+	case NodeHostAddressChanged:
+		return "nodehost-address-changed"
+	case ShardReplicasChanged:
+		return "shard-replicas-changed"
+	case ShardLeaderChanged:
+		return "shard-leader-changed"
+	default:
+		return "unknown"
+	}
+}
+
+// RegistryEvent is a change of the registry observed by the local NodeHost
+// instance.
+type RegistryEvent struct {
+	// Type is the type of the event.
+	Type RegistryEventType
+	// Time is the time the change was received by the local gossip service.
+	// Events for the same NodeHost or shard are delivered in Time order.
+	Time time.Time
+	// NodeHostID is the NodeHostID of the NodeHost instance, it is only set
+	// for NodeHost events.
+	NodeHostID string
+	// RaftAddress is the RaftAddress of the NodeHost instance, it is only set
+	// for NodeHost events.
+	RaftAddress string
+	// Shard is the placement of the shard after the change, it is only set for
+	// shard events. Its Term and ConfigChangeIndex fields can be used to
+	// discard stale updates.
+	Shard ShardPlacement
+}
+
+type watcher struct {
+	ch chan RegistryEvent
+}
+
+// send delivers the event without blocking. When the buffer is full, all
+// buffered events are dropped and replaced by a Resync event.
+func (w *watcher) send(e RegistryEvent) {
+	select {
+	case w.ch <- e:
+		return
+	default:
+	}
+	for drained := false; !drained; {
+		select {
+		case <-w.ch:
+		default:
+			drained = true
+		}
+	}
+	// only the publisher sends to the channel, there is room for the Resync
+	// event after the buffer is drained
+	w.ch <- RegistryEvent{Type: Resync, Time: e.Time}
+	select {
+	case w.ch <- e:
+	default:
+	}
+}
+
+// watchers manages watchers of the registry.
+type watchers struct {
+	mu       sync.Mutex
+	nextID   uint64
+	watchers map[uint64]*watcher
+}
+
+func newWatchers() *watchers {
+	return &watchers{watchers: make(map[uint64]*watcher)}
+}
+
+// watch registers a new watcher with the specified buffer size. The returned
+// function unregisters the watcher and closes the returned channel.
+func (w *watchers) watch(buffer int) (<-chan RegistryEvent, func()) {
+	if buffer < 1 {
+		buffer = 1
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.nextID++
+	id := w.nextID
+	ch := make(chan RegistryEvent, buffer)
+	w.watchers[id] = &watcher{ch: ch}
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if _, ok := w.watchers[id]; ok {
+			delete(w.watchers, id)
+			close(ch)
+		}
+	}
+}
+
+func (w *watchers) active() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.watchers) > 0
+}
+
+func (w *watchers) publish(events ...RegistryEvent) {
+	if len(events) == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, watcher := range w.watchers {
+		for _, e := range events {
+			watcher.send(e)
+		}
+	}
+}
+
+// idleWatch returns a watch that never delivers any event, it is used by
+// registries without change notification support.
+func idleWatch(buffer int) (<-chan RegistryEvent, func()) {
+	return newWatchers().watch(buffer)
+}
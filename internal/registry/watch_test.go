@@ -0,0 +1,148 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/assert"
+)
+
+func getWatchedNodeHostRegistry() *NodeHostRegistry {
+	r := getTestNodeHostRegistry()
+	r.watchers = newWatchers()
+	r.view.onChange = r.shardsChanged
+	return r
+}
+
+func drain(ch <-chan RegistryEvent) []RegistryEvent {
+	var result []RegistryEvent
+	for {
+		select {
+		case e := <-ch:
+			result = append(result, e)
+		default:
+			return result
+		}
+	}
+}
+
+func getEventTypes(events []RegistryEvent) []RegistryEventType {
+	result := make([]RegistryEventType, 0, len(events))
+	for _, e := range events {
+		result = append(result, e.Type)
+	}
+	return result
+}
+
+func TestWatchReportsShardChanges(t *testing.T) {
+	r := getWatchedNodeHostRegistry()
+	now := time.Unix(1000, 0)
+	r.view.clock = func() time.Time { return now }
+	ch, cancel := r.Watch(16)
+	defer cancel()
+	r.view.update([]ShardView{{
+		ShardID:           1,
+		ConfigChangeIndex: 1,
+		Replicas:          map[uint64]string{1: "nh1", 2: "nh2"},
+	}})
+	events := drain(ch)
+	assert.Equal(t, []RegistryEventType{ShardReplicasChanged}, getEventTypes(events))
+	assert.Equal(t, now, events[0].Time)
+	assert.Equal(t, uint64(1), events[0].Shard.ShardID)
+	assert.Len(t, events[0].Shard.Replicas, 2)
+	// repeated updates are not reported
+	r.view.update([]ShardView{{ShardID: 1, ConfigChangeIndex: 1}})
+	assert.Empty(t, drain(ch))
+	r.view.update([]ShardView{{ShardID: 1, LeaderID: 2, Term: 2}})
+	events = drain(ch)
+	assert.Equal(t, []RegistryEventType{ShardLeaderChanged}, getEventTypes(events))
+	assert.Equal(t, uint64(2), events[0].Shard.LeaderID)
+	assert.True(t, events[0].Shard.Replicas[1].IsLeader)
+	// stale leader is ignored
+	r.view.update([]ShardView{{ShardID: 1, LeaderID: 1, Term: 1}})
+	assert.Empty(t, drain(ch))
+	r.view.update([]ShardView{{
+		ShardID:           1,
+		ConfigChangeIndex: 2,
+		Replicas:          map[uint64]string{2: "nh2", 3: "nh3"},
+		LeaderID:          3,
+		Term:              3,
+	}})
+	events = drain(ch)
+	assert.Equal(t, []RegistryEventType{ShardReplicasChanged, ShardLeaderChanged},
+		getEventTypes(events))
+	assert.Equal(t, uint64(2), events[1].Shard.ConfigChangeIndex)
+	assert.Equal(t, uint64(3), events[1].Shard.Term)
+}
+
+func TestWatchReportsNodeHostChanges(t *testing.T) {
+	w := newWatchers()
+	e := newSliceEventDelegate(&metaStore{}, newLiveness(0), w)
+	ch, cancel := w.watch(16)
+	defer cancel()
+	getNode := func(addr string) *memberlist.Node {
+		m := meta{RaftAddress: addr}
+		return &memberlist.Node{Name: "nh1", Meta: m.marshal()}
+	}
+	e.NotifyJoin(getNode("localhost:9001"))
+	e.NotifyUpdate(getNode("localhost:9001"))
+	e.NotifyUpdate(getNode("localhost:9002"))
+	e.NotifyLeave(getNode("localhost:9002"))
+	e.NotifyLeave(getNode("localhost:9002"))
+	events := drain(ch)
+	assert.Equal(t, []RegistryEventType{
+		NodeHostJoined, NodeHostAddressChanged, NodeHostLeft,
+	}, getEventTypes(events))
+	for idx, addr := range []string{
+		"localhost:9001", "localhost:9002", "localhost:9002",
+	} {
+		assert.Equal(t, "nh1", events[idx].NodeHostID)
+		assert.Equal(t, addr, events[idx].RaftAddress)
+		assert.False(t, events[idx].Time.IsZero())
+	}
+}
+
+func TestWatchResyncsAfterDroppingEvents(t *testing.T) {
+	w := newWatchers()
+	ch, cancel := w.watch(4)
+	defer cancel()
+	for i := 0; i < 4; i++ {
+		w.publish(RegistryEvent{Type: NodeHostJoined})
+	}
+	w.publish(RegistryEvent{Type: NodeHostLeft})
+	assert.Equal(t, []RegistryEventType{Resync, NodeHostLeft},
+		getEventTypes(drain(ch)))
+	// a single slot buffer only keeps the Resync event
+	ch1, cancel1 := w.watch(0)
+	defer cancel1()
+	w.publish(RegistryEvent{Type: NodeHostJoined})
+	w.publish(RegistryEvent{Type: NodeHostLeft})
+	assert.Equal(t, []RegistryEventType{Resync}, getEventTypes(drain(ch1)))
+}
+
+func TestCanceledWatchIsClosed(t *testing.T) {
+	w := newWatchers()
+	ch, cancel := w.watch(1)
+	assert.True(t, w.active())
+	cancel()
+	cancel()
+	assert.False(t, w.active())
+	w.publish(RegistryEvent{Type: NodeHostJoined})
+	_, ok := <-ch
+	assert.False(t, ok)
+}
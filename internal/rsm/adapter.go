@@ -38,6 +38,8 @@ type IStateMachine interface {
 	Recover(io.Reader, []sm.SnapshotFile, <-chan struct{}) error
 	Close() error
 	GetHash() (uint64, error)
+	Fingerprint() (uint64, error)
+	NonRetaining() bool
 	Concurrent() bool
 	OnDisk() bool
 	Type() pb.StateMachineType
@@ -48,7 +50,10 @@ type IStateMachine interface {
 type InMemStateMachine struct {
 	sm sm.IStateMachine
 	h  sm.IHash
+	f  sm.IFingerprint
 	na sm.IExtended
+	bl sm.IByteLookup
+	nr bool
 }
 
 var _ IStateMachine = (*InMemStateMachine)(nil)
@@ -59,9 +64,16 @@ func NewInMemStateMachine(s sm.IStateMachine) *InMemStateMachine {
 	if h, ok := s.(sm.IHash); ok {
 		i.h = h
 	}
+	if f, ok := s.(sm.IFingerprint); ok {
+		i.f = f
+	}
 	if na, ok := s.(sm.IExtended); ok {
 		i.na = na
 	}
+	if bl, ok := s.(sm.IByteLookup); ok {
+		i.bl = bl
+	}
+	_, i.nr = s.(sm.INonRetainingStateMachine)
 	return i
 }
 
@@ -87,6 +99,9 @@ func (i *InMemStateMachine) Lookup(query interface{}) (interface{}, error) {
 
 // NALookup queries the state machine.
 func (i *InMemStateMachine) NALookup(query []byte) ([]byte, error) {
+	if i.bl != nil {
+		return i.bl.LookupBytes(query)
+	}
 	if i.na == nil {
 		return nil, sm.ErrNotImplemented
 	}
@@ -133,6 +148,21 @@ func (i *InMemStateMachine) GetHash() (uint64, error) {
 	return h, errors.WithStack(err)
 }
 
+// Fingerprint returns the fingerprint of the state machine.
+func (i *InMemStateMachine) Fingerprint() (uint64, error) {
+	if i.f == nil {
+		return 0, sm.ErrNotImplemented
+	}
+	f, err := i.f.Fingerprint()
+	return f, errors.WithStack(err)
+}
+
+// NonRetaining returns a boolean flag indicating whether the state machine
+// never retains the Cmd of applied entries.
+func (i *InMemStateMachine) NonRetaining() bool {
+	return i.nr
+}
+
 // Concurrent returns a boolean flag indicating whether the state machine is
 // capable of taking concurrent snapshot.
 func (i *InMemStateMachine) Concurrent() bool {
@@ -155,7 +185,10 @@ func (i *InMemStateMachine) Type() pb.StateMachineType {
 type ConcurrentStateMachine struct {
 	sm sm.IConcurrentStateMachine
 	h  sm.IHash
+	f  sm.IFingerprint
 	na sm.IExtended
+	bl sm.IByteLookup
+	nr bool
 }
 
 // NewConcurrentStateMachine creates a new ConcurrentStateMachine instance.
@@ -164,9 +197,16 @@ func NewConcurrentStateMachine(s sm.IConcurrentStateMachine) *ConcurrentStateMac
 	if h, ok := s.(sm.IHash); ok {
 		v.h = h
 	}
+	if f, ok := s.(sm.IFingerprint); ok {
+		v.f = f
+	}
 	if na, ok := s.(sm.IExtended); ok {
 		v.na = na
 	}
+	if bl, ok := s.(sm.IByteLookup); ok {
+		v.bl = bl
+	}
+	_, v.nr = s.(sm.INonRetainingStateMachine)
 	return v
 }
 
@@ -188,6 +228,9 @@ func (s *ConcurrentStateMachine) Lookup(query interface{}) (interface{}, error)
 
 // NALookup queries the state machine.
 func (s *ConcurrentStateMachine) NALookup(query []byte) ([]byte, error) {
+	if s.bl != nil {
+		return s.bl.LookupBytes(query)
+	}
 	if s.na == nil {
 		return nil, sm.ErrNotImplemented
 	}
@@ -232,6 +275,21 @@ func (s *ConcurrentStateMachine) GetHash() (uint64, error) {
 	return h, errors.WithStack(err)
 }
 
+// Fingerprint returns the fingerprint of the state machine.
+func (s *ConcurrentStateMachine) Fingerprint() (uint64, error) {
+	if s.f == nil {
+		return 0, sm.ErrNotImplemented
+	}
+	f, err := s.f.Fingerprint()
+	return f, errors.WithStack(err)
+}
+
+// NonRetaining returns a boolean flag indicating whether the state machine
+// never retains the Cmd of applied entries.
+func (s *ConcurrentStateMachine) NonRetaining() bool {
+	return s.nr
+}
+
 // Concurrent returns a boolean flag indicating whether the state machine is
 // capable of taking concurrent snapshot.
 func (s *ConcurrentStateMachine) Concurrent() bool {
@@ -258,7 +316,10 @@ type ITestFS interface {
 type OnDiskStateMachine struct {
 	sm     sm.IOnDiskStateMachine
 	h      sm.IHash
+	f      sm.IFingerprint
 	na     sm.IExtended
+	bl     sm.IByteLookup
+	nr     bool
 	opened bool
 }
 
@@ -268,9 +329,16 @@ func NewOnDiskStateMachine(s sm.IOnDiskStateMachine) *OnDiskStateMachine {
 	if h, ok := s.(sm.IHash); ok {
 		r.h = h
 	}
+	if f, ok := s.(sm.IFingerprint); ok {
+		r.f = f
+	}
 	if na, ok := s.(sm.IExtended); ok {
 		r.na = na
 	}
+	if bl, ok := s.(sm.IByteLookup); ok {
+		r.bl = bl
+	}
+	_, r.nr = s.(sm.INonRetainingStateMachine)
 	return r
 }
 
@@ -308,6 +376,12 @@ func (s *OnDiskStateMachine) Lookup(query interface{}) (interface{}, error) {
 // NALookup queries the state machine.
 func (s *OnDiskStateMachine) NALookup(query []byte) ([]byte, error) {
 	s.ensureOpened()
+	if s.bl != nil {
+		return s.bl.LookupBytes(query)
+	}
+	if s.na == nil {
+		return nil, sm.ErrNotImplemented
+	}
 	return s.na.NALookup(query)
 }
 
@@ -354,6 +428,22 @@ func (s *OnDiskStateMachine) GetHash() (uint64, error) {
 	return h, errors.WithStack(err)
 }
 
+// Fingerprint returns the fingerprint of the state machine.
+func (s *OnDiskStateMachine) Fingerprint() (uint64, error) {
+	s.ensureOpened()
+	if s.f == nil {
+		return 0, sm.ErrNotImplemented
+	}
+	f, err := s.f.Fingerprint()
+	return f, errors.WithStack(err)
+}
+
+// NonRetaining returns a boolean flag indicating whether the state machine
+// never retains the Cmd of applied entries.
+func (s *OnDiskStateMachine) NonRetaining() bool {
+	return s.nr
+}
+
 // Concurrent returns a boolean flag indicating whether the state machine is
 // capable of taking concurrent snapshot.
 func (s *OnDiskStateMachine) Concurrent() bool {
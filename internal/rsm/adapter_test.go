@@ -19,6 +19,7 @@ import (
 	"testing"
 
 	"github.com/lni/dragonboat/v4/internal/tests"
+	sm "github.com/lni/dragonboat/v4/statemachine"
 )
 
 func TestOnDiskSMCanBeOpened(t *testing.T) {
@@ -84,3 +85,33 @@ func TestRecoverFromSnapshotCanComplete(t *testing.T) {
 		t.Errorf("recover from snapshot failed %v", err)
 	}
 }
+
+type byteLookupSM struct {
+	tests.NoOP
+	result []byte
+}
+
+func (s *byteLookupSM) LookupBytes(query []byte) ([]byte, error) {
+	return s.result, nil
+}
+
+func TestNALookupPrefersByteLookup(t *testing.T) {
+	s := &byteLookupSM{result: []byte("byte-lookup")}
+	result, err := NewInMemStateMachine(s).NALookup([]byte("query"))
+	if err != nil {
+		t.Fatalf("lookup failed %v", err)
+	}
+	if !bytes.Equal(result, s.result) {
+		t.Errorf("unexpected result %s", result)
+	}
+}
+
+func TestOnDiskSMNALookupCanReturnErrNotImplemented(t *testing.T) {
+	od := NewOnDiskStateMachine(tests.NewFakeDiskSM(0))
+	if _, err := od.Open(nil); err != nil {
+		t.Fatalf("failed to open %v", err)
+	}
+	if _, err := od.NALookup(nil); err != sm.ErrNotImplemented {
+		t.Errorf("unexpected error %v", err)
+	}
+}
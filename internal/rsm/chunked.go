@@ -0,0 +1,436 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/settings"
+	"github.com/lni/dragonboat/v4/internal/utils/dio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// Large proposals are proposed as a stream of chunk entries made with NO-OP
+// client sessions followed by a manifest entry made with the client session
+// of the proposal. The state machine reassembles the payload once the
+// manifest is applied, chunks are never passed to the user state machine.
+//
+// Entry Cmd format of chunk entries, the part is v0 encoded.
+//
+// --------------------------------------------------------
+// |Header|Kind |StreamID|Seq    |Count  |Part            |
+// |1Byte |1Byte|Uvarint |Uvarint|Uvarint|Remaining Bytes |
+// --------------------------------------------------------
+//
+// Entry Cmd format of manifest entries.
+//
+// ------------------------------------------
+// |Header|Kind |StreamID|Count  |Size      |
+// |1Byte |1Byte|Uvarint |Uvarint|Uvarint   |
+// ------------------------------------------
+const (
+	chunkPart     uint8 = 0
+	chunkManifest uint8 = 1
+)
+
+// incompleteChunksData is the data of the result of manifests rejected as
+// their chunk streams are incomplete or no longer available.
+var incompleteChunksData = []byte("incomplete chunked proposal")
+
+// IncompleteChunksResult returns the result of manifest entries rejected as
+// not all chunks of the proposal are available.
+func IncompleteChunksResult() sm.Result {
+	return sm.Result{Data: incompleteChunksData}
+}
+
+// IsIncompleteChunksResult returns a boolean value indicating whether the
+// result is the one of a manifest entry rejected as not all chunks of the
+// proposal are available.
+func IsIncompleteChunksResult(result sm.Result) bool {
+	return result.Value == 0 && bytes.Equal(result.Data, incompleteChunksData)
+}
+
+// GetChunked splits the payload into chunks of up to chunkSize bytes, it
+// returns the encoded chunk entry Cmds and the encoded manifest entry Cmd of
+// the specified chunk stream.
+func GetChunked(ct dio.CompressionType,
+	streamID uint64, cmd []byte, chunkSize uint64) ([][]byte, []byte) {
+	if len(cmd) == 0 || chunkSize == 0 {
+		panic("invalid chunked payload")
+	}
+	count := (uint64(len(cmd)) + chunkSize - 1) / chunkSize
+	chunks := make([][]byte, 0, count)
+	for seq := uint64(0); seq < count; seq++ {
+		end := (seq + 1) * chunkSize
+		if end > uint64(len(cmd)) {
+			end = uint64(len(cmd))
+		}
+		buf := getChunkHeader(chunkPart, streamID, seq, count)
+		part := getEncoded(ct, cmd[seq*chunkSize:end], nil)
+		chunks = append(chunks, append(buf, part...))
+	}
+	manifest := getChunkHeader(chunkManifest, streamID, count)
+	manifest = binary.AppendUvarint(manifest, uint64(len(cmd)))
+	return chunks, manifest
+}
+
+func getChunkHeader(kind uint8, values ...uint64) []byte {
+	buf := make([]byte, 0, 2+len(values)*binary.MaxVarintLen64)
+	buf = append(buf, getEncodedHeader(EEChunked, EENoCompression, false), kind)
+	for _, v := range values {
+		buf = binary.AppendUvarint(buf, v)
+	}
+	return buf
+}
+
+// IsChunkedEntry returns a boolean value indicating whether the entry is a
+// chunk or manifest entry of a chunked proposal.
+func IsChunkedEntry(e pb.Entry) bool {
+	if e.Type != pb.EncodedEntry || len(e.Cmd) == 0 {
+		return false
+	}
+	ver, _, _ := parseEncodedHeader(e.Cmd)
+	return ver == EEChunked
+}
+
+// isChunkPart returns a boolean value indicating whether the entry is a chunk
+// entry of a chunked proposal.
+func isChunkPart(e pb.Entry) bool {
+	return IsChunkedEntry(e) && len(e.Cmd) > 1 && e.Cmd[1] == chunkPart
+}
+
+// chunk is a parsed chunk or manifest entry.
+type chunk struct {
+	kind     uint8
+	streamID uint64
+	seq      uint64
+	count    uint64
+	size     uint64
+	part     []byte
+}
+
+func parseChunk(cmd []byte) chunk {
+	if len(cmd) < 2 {
+		plog.Panicf("invalid chunked entry")
+	}
+	c := chunk{kind: cmd[1]}
+	offset := 2
+	next := func() uint64 {
+		v, n := binary.Uvarint(cmd[offset:])
+		if n <= 0 {
+			plog.Panicf("invalid chunked entry")
+		}
+		offset += n
+		return v
+	}
+	c.streamID = next()
+	switch c.kind {
+	case chunkPart:
+		c.seq = next()
+		c.count = next()
+		c.part = cmd[offset:]
+	case chunkManifest:
+		c.count = next()
+		c.size = next()
+	default:
+		plog.Panicf("unknown chunked entry kind %d", c.kind)
+	}
+	return c
+}
+
+// chunkStream is a chunked proposal being reassembled.
+type chunkStream struct {
+	// term is the term of all chunks of the stream, chunks of a stream must be
+	// proposed to the same leader
+	term uint64
+	// lastIndex is the index of the last applied chunk
+	lastIndex uint64
+	count     uint64
+	parts     [][]byte
+}
+
+func (cs *chunkStream) complete() bool {
+	return uint64(len(cs.parts)) == cs.count
+}
+
+// dead returns a boolean value indicating whether the stream can no longer be
+// completed by its manifest once the entry with the specified index and term
+// is applied. Incomplete streams die when their term ends, all streams die
+// after ChunkStreamTTLEntries entries without further chunk. A dead stream
+// stays dead once the shard moves on, streams can thus be discarded at any
+// point without affecting the outcome of later entries.
+func (cs *chunkStream) dead(index uint64, term uint64) bool {
+	if !cs.complete() && term > cs.term {
+		return true
+	}
+	return index > cs.lastIndex+settings.ChunkStreamTTLEntries
+}
+
+func (cs *chunkStream) payload(size uint64) ([]byte, bool) {
+	if !cs.complete() {
+		return nil, false
+	}
+	total := uint64(0)
+	for _, p := range cs.parts {
+		total += uint64(len(p))
+	}
+	if total != size {
+		return nil, false
+	}
+	result := make([]byte, 0, size)
+	for _, p := range cs.parts {
+		result = append(result, p...)
+	}
+	return result, true
+}
+
+// chunkStreams contains the chunked proposals being reassembled, they are
+// saved along with client sessions in snapshots. The zero value is ready to
+// use.
+type chunkStreams struct {
+	streams map[uint64]*chunkStream
+}
+
+// add adds the chunk in the specified chunk entry to its stream. A chunk not
+// continuing its stream in the same term breaks the stream, the manifest of
+// such stream is rejected.
+func (c *chunkStreams) add(e pb.Entry) error {
+	ch := parseChunk(e.Cmd)
+	if ch.kind != chunkPart {
+		plog.Panicf("not a chunk entry")
+	}
+	part, err := getDecodedPayload(ch.part, nil)
+	if err != nil {
+		return err
+	}
+	part = append([]byte(nil), part...)
+	if ch.seq == 0 {
+		if c.streams == nil {
+			c.streams = make(map[uint64]*chunkStream)
+		}
+		delete(c.streams, ch.streamID)
+		c.gc(e.Index, e.Term)
+		c.makeRoom()
+		c.streams[ch.streamID] = &chunkStream{
+			term:      e.Term,
+			lastIndex: e.Index,
+			count:     ch.count,
+			parts:     [][]byte{part},
+		}
+		return nil
+	}
+	cs, ok := c.streams[ch.streamID]
+	if !ok {
+		return nil
+	}
+	if cs.dead(e.Index, e.Term) || cs.term != e.Term ||
+		cs.count != ch.count || uint64(len(cs.parts)) != ch.seq {
+		plog.Warningf("chunk stream %d broken at chunk %d", ch.streamID, ch.seq)
+		delete(c.streams, ch.streamID)
+		return nil
+	}
+	cs.parts = append(cs.parts, part)
+	cs.lastIndex = e.Index
+	return nil
+}
+
+// take removes the stream of the specified manifest entry and returns its
+// reassembled payload, the returned boolean value indicates whether the
+// stream is complete.
+func (c *chunkStreams) take(e pb.Entry) ([]byte, bool) {
+	ch := parseChunk(e.Cmd)
+	if ch.kind != chunkManifest {
+		plog.Panicf("not a manifest entry")
+	}
+	cs, ok := c.streams[ch.streamID]
+	if !ok {
+		return nil, false
+	}
+	delete(c.streams, ch.streamID)
+	if cs.dead(e.Index, e.Term) || cs.count != ch.count {
+		return nil, false
+	}
+	return cs.payload(ch.size)
+}
+
+// gc discards streams that are dead once the entry with the specified index
+// and term is applied.
+func (c *chunkStreams) gc(index uint64, term uint64) {
+	for id, cs := range c.streams {
+		if cs.dead(index, term) {
+			plog.Warningf("chunk stream %d discarded, last chunk %d",
+				id, cs.lastIndex)
+			delete(c.streams, id)
+		}
+	}
+}
+
+// makeRoom discards the least recently active stream when there are already
+// MaxChunkStreams streams.
+func (c *chunkStreams) makeRoom() {
+	if uint64(len(c.streams)) < settings.MaxChunkStreams {
+		return
+	}
+	oldestID := uint64(0)
+	var oldest *chunkStream
+	for id, cs := range c.streams {
+		if oldest == nil || cs.lastIndex < oldest.lastIndex {
+			oldestID, oldest = id, cs
+		}
+	}
+	plog.Warningf("chunk stream %d discarded, too many streams", oldestID)
+	delete(c.streams, oldestID)
+}
+
+// live returns the IDs of streams not dead at the specified index and term in
+// ascending order, all streams are returned when index is 0.
+func (c *chunkStreams) live(index uint64, term uint64) []uint64 {
+	ids := make([]uint64, 0, len(c.streams))
+	for id, cs := range c.streams {
+		if index == 0 || !cs.dead(index, term) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// save saves the specified streams to the writer.
+func (c *chunkStreams) save(writer io.Writer, ids []uint64) error {
+	buf := make([]byte, 0, 64)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(ids)))
+	if _, err := writer.Write(buf); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		cs := c.streams[id]
+		buf = buf[:0]
+		for _, v := range []uint64{id,
+			cs.term, cs.lastIndex, cs.count, uint64(len(cs.parts))} {
+			buf = binary.LittleEndian.AppendUint64(buf, v)
+		}
+		if _, err := writer.Write(buf); err != nil {
+			return err
+		}
+		for _, p := range cs.parts {
+			buf = binary.LittleEndian.AppendUint64(buf[:0], uint64(len(p)))
+			if _, err := writer.Write(buf); err != nil {
+				return err
+			}
+			if _, err := writer.Write(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// load restores streams saved by save from the reader.
+func (c *chunkStreams) load(reader io.Reader) error {
+	buf := make([]byte, 8)
+	next := func() (uint64, error) {
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint64(buf), nil
+	}
+	total, err := next()
+	if err != nil {
+		return err
+	}
+	streams := make(map[uint64]*chunkStream)
+	for i := uint64(0); i < total; i++ {
+		var v [5]uint64
+		for j := range v {
+			if v[j], err = next(); err != nil {
+				return err
+			}
+		}
+		cs := &chunkStream{term: v[1], lastIndex: v[2], count: v[3]}
+		if v[4] > cs.count {
+			return errors.Newf("chunk stream %d has %d chunks, count %d",
+				v[0], v[4], cs.count)
+		}
+		for j := uint64(0); j < v[4]; j++ {
+			sz, err := next()
+			if err != nil {
+				return err
+			}
+			p := make([]byte, sz)
+			if _, err := io.ReadFull(reader, p); err != nil {
+				return err
+			}
+			cs.parts = append(cs.parts, p)
+		}
+		streams[v[0]] = cs
+	}
+	c.streams = streams
+	return nil
+}
+
+// ChunkAssembler reassembles chunked proposals from their chunk and manifest
+// entries passed to it in index order. It applies the same rules as the state
+// machine, the outcome of each manifest entry is thus the same as the one of
+// the state machine when the first chunk of the proposal has been passed to
+// the assembler.
+type ChunkAssembler struct {
+	streams chunkStreams
+	// started contains the IDs of streams whose first chunk has been passed to
+	// the assembler, mapped to the index of that chunk.
+	started map[uint64]uint64
+}
+
+// IsChunkManifest returns a boolean value indicating whether the entry is the
+// manifest entry of a chunked proposal.
+func IsChunkManifest(e pb.Entry) bool {
+	return IsChunkedEntry(e) && len(e.Cmd) > 1 && e.Cmd[1] == chunkManifest
+}
+
+// Add adds the chunk in the specified chunk entry to its chunked proposal.
+func (a *ChunkAssembler) Add(e pb.Entry) error {
+	ch := parseChunk(e.Cmd)
+	if ch.kind == chunkPart && ch.seq == 0 {
+		if a.started == nil {
+			a.started = make(map[uint64]uint64)
+		}
+		for id, index := range a.started {
+			if _, ok := a.streams.streams[id]; !ok &&
+				index+settings.ChunkStreamTTLEntries < e.Index {
+				delete(a.started, id)
+			}
+		}
+		a.started[ch.streamID] = e.Index
+	}
+	return a.streams.add(e)
+}
+
+// Take removes the chunked proposal of the specified manifest entry and
+// returns its reassembled payload. The first returned boolean value indicates
+// whether all chunks are available, the second one indicates whether the first
+// chunk of the proposal has been passed to the assembler. The outcome of the
+// manifest entry is unknown when the first chunk has not been observed.
+func (a *ChunkAssembler) Take(e pb.Entry) ([]byte, bool, bool) {
+	ch := parseChunk(e.Cmd)
+	_, observed := a.started[ch.streamID]
+	delete(a.started, ch.streamID)
+	payload, ok := a.streams.take(e)
+	return payload, ok, observed
+}
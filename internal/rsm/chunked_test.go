@@ -0,0 +1,386 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/settings"
+	"github.com/lni/dragonboat/v4/internal/utils/dio"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+type chunkTestSM struct {
+	updates []sm.Entry
+}
+
+func (s *chunkTestSM) Update(e sm.Entry) (sm.Result, error) {
+	s.updates = append(s.updates, sm.Entry{Index: e.Index,
+		Cmd: append([]byte(nil), e.Cmd...)})
+	return sm.Result{Value: uint64(len(s.updates))}, nil
+}
+
+func (s *chunkTestSM) Lookup(query interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func (s *chunkTestSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	return nil
+}
+
+func (s *chunkTestSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	return nil
+}
+
+func (s *chunkTestSM) Close() error { return nil }
+
+func newChunkTestStateMachine() (*StateMachine, *chunkTestSM, *testNodeProxy) {
+	fs := vfs.GetTestFS()
+	store := &chunkTestSM{}
+	cfg := config.Config{ShardID: 1, ReplicaID: 1}
+	ds := NewNativeSM(cfg, NewInMemStateMachine(store), make(chan struct{}))
+	nodeProxy := newTestNodeProxy()
+	s := NewStateMachine(ds, newTestSnapshotter(fs), cfg, nodeProxy, fs)
+	return s, store, nodeProxy
+}
+
+// getChunkTestEntries returns the chunk entries and the manifest entry of the
+// payload, entries have consecutive indexes starting from index.
+func getChunkTestEntries(streamID uint64, payload []byte,
+	index uint64, term uint64, session *client.Session) ([]pb.Entry, pb.Entry) {
+	chunks, manifest := GetChunked(dio.NoCompression, streamID, payload, 64)
+	entries := make([]pb.Entry, 0, len(chunks))
+	for _, c := range chunks {
+		entries = append(entries, pb.Entry{
+			Type:     pb.EncodedEntry,
+			Key:      index,
+			Index:    index,
+			Term:     term,
+			ClientID: 100,
+			SeriesID: client.NoOPSeriesID,
+			Cmd:      c,
+		})
+		index++
+	}
+	return entries, pb.Entry{
+		Type:        pb.EncodedEntry,
+		Key:         index,
+		Index:       index,
+		Term:        term,
+		ClientID:    session.ClientID,
+		SeriesID:    session.SeriesID,
+		RespondedTo: session.RespondedTo,
+		Cmd:         manifest,
+	}
+}
+
+func getChunkTestPayload(sz int) []byte {
+	payload := make([]byte, sz)
+	rand.Read(payload)
+	return payload
+}
+
+func handleChunkTestEntries(t *testing.T,
+	s *StateMachine, entries ...pb.Entry) {
+	t.Helper()
+	for _, e := range entries {
+		if err := s.handleEntry(e, true); err != nil {
+			t.Fatalf("handle entry failed %v", err)
+		}
+	}
+}
+
+func TestChunkedPayloadCanBeEncoded(t *testing.T) {
+	for _, ct := range []dio.CompressionType{dio.NoCompression, dio.Snappy} {
+		payload := getChunkTestPayload(1000)
+		chunks, manifest := GetChunked(ct, 123, payload, 64)
+		if len(chunks) != 16 {
+			t.Fatalf("%d chunks, want 16", len(chunks))
+		}
+		var result []byte
+		for i, c := range chunks {
+			e := pb.Entry{Type: pb.EncodedEntry, Cmd: c}
+			if !IsChunkedEntry(e) || !isChunkPart(e) {
+				t.Fatalf("not a chunk entry")
+			}
+			ch := parseChunk(c)
+			if ch.streamID != 123 || ch.seq != uint64(i) || ch.count != 16 {
+				t.Fatalf("unexpected chunk %+v", ch)
+			}
+			part, err := getDecodedPayload(ch.part, nil)
+			if err != nil {
+				t.Fatalf("failed to decode %v", err)
+			}
+			result = append(result, part...)
+		}
+		if !bytes.Equal(result, payload) {
+			t.Errorf("payload changed")
+		}
+		e := pb.Entry{Type: pb.EncodedEntry, Cmd: manifest}
+		if !IsChunkedEntry(e) || isChunkPart(e) {
+			t.Fatalf("not a manifest entry")
+		}
+		if ch := parseChunk(manifest); ch.streamID != 123 ||
+			ch.count != 16 || ch.size != 1000 {
+			t.Errorf("unexpected manifest %+v", ch)
+		}
+		regular := pb.Entry{Type: pb.EncodedEntry,
+			Cmd: GetEncoded(ct, payload, nil)}
+		if IsChunkedEntry(regular) {
+			t.Errorf("regular entry considered as chunked")
+		}
+	}
+}
+
+func TestChunkedProposalIsReassembled(t *testing.T) {
+	s, store, nodeProxy := newChunkTestStateMachine()
+	payload := getChunkTestPayload(1000)
+	session := &client.Session{ClientID: 200, SeriesID: client.NoOPSeriesID}
+	chunks, manifest := getChunkTestEntries(1, payload, 1, 1, session)
+	handleChunkTestEntries(t, s, chunks...)
+	if len(store.updates) != 0 {
+		t.Fatalf("chunk passed to the state machine")
+	}
+	if nodeProxy.rejected || nodeProxy.index != chunks[len(chunks)-1].Index {
+		t.Errorf("chunk not notified as applied")
+	}
+	handleChunkTestEntries(t, s, manifest)
+	if len(store.updates) != 1 {
+		t.Fatalf("%d updates, want 1", len(store.updates))
+	}
+	if store.updates[0].Index != manifest.Index ||
+		!bytes.Equal(store.updates[0].Cmd, payload) {
+		t.Errorf("unexpected update")
+	}
+	if nodeProxy.rejected || nodeProxy.smResult.Value != 1 {
+		t.Errorf("unexpected result %v", nodeProxy.smResult)
+	}
+	if len(s.sessions.chunks.streams) != 0 {
+		t.Errorf("chunk stream not removed")
+	}
+	if s.index != manifest.Index {
+		t.Errorf("unexpected applied index %d", s.index)
+	}
+}
+
+func TestChunkedProposalWithLostChunkIsRejected(t *testing.T) {
+	s, store, nodeProxy := newChunkTestStateMachine()
+	session := &client.Session{ClientID: 200, SeriesID: client.NoOPSeriesID}
+	chunks, manifest := getChunkTestEntries(1,
+		getChunkTestPayload(1000), 1, 1, session)
+	handleChunkTestEntries(t, s, chunks[:3]...)
+	// the 4th chunk is lost
+	noop := pb.Entry{Index: chunks[3].Index, Term: 1}
+	handleChunkTestEntries(t, s, noop)
+	handleChunkTestEntries(t, s, chunks[4:]...)
+	handleChunkTestEntries(t, s, manifest)
+	if len(store.updates) != 0 {
+		t.Fatalf("incomplete chunked proposal applied")
+	}
+	if !nodeProxy.rejected || !IsIncompleteChunksResult(nodeProxy.smResult) {
+		t.Errorf("manifest not rejected, %v", nodeProxy.smResult)
+	}
+	if len(s.sessions.chunks.streams) != 0 {
+		t.Errorf("chunk stream not removed")
+	}
+}
+
+func TestIncompleteChunkStreamDiesOnTermChange(t *testing.T) {
+	s, store, nodeProxy := newChunkTestStateMachine()
+	session := &client.Session{ClientID: 200, SeriesID: client.NoOPSeriesID}
+	p1 := getChunkTestPayload(200)
+	c1, m1 := getChunkTestEntries(1, p1, 1, 1, session)
+	c2, m2 := getChunkTestEntries(2,
+		getChunkTestPayload(200), m1.Index, 1, session)
+	// the first proposal is complete in term 1, its manifest is committed in
+	// term 2, the second one has some of its chunks committed in term 2
+	for i := 2; i < len(c2); i++ {
+		c2[i].Term = 2
+	}
+	m2.Term = 2
+	m1.Index, m1.Term = m2.Index+1, 2
+	handleChunkTestEntries(t, s, c1...)
+	handleChunkTestEntries(t, s, c2...)
+	handleChunkTestEntries(t, s, m2)
+	if !nodeProxy.rejected || !IsIncompleteChunksResult(nodeProxy.smResult) {
+		t.Errorf("manifest not rejected, %v", nodeProxy.smResult)
+	}
+	handleChunkTestEntries(t, s, m1)
+	if nodeProxy.rejected || len(store.updates) != 1 ||
+		!bytes.Equal(store.updates[0].Cmd, p1) {
+		t.Errorf("complete chunked proposal not applied")
+	}
+}
+
+func TestChunkedProposalIsAppliedOnceForSession(t *testing.T) {
+	s, store, nodeProxy := newChunkTestStateMachine()
+	session := &client.Session{ClientID: 200, SeriesID: 1}
+	handleChunkTestEntries(t, s, pb.Entry{ClientID: 200,
+		SeriesID: client.SeriesIDForRegister, Index: 1, Term: 1})
+	p1 := getChunkTestPayload(200)
+	c1, m1 := getChunkTestEntries(1, p1, 2, 1, session)
+	// a rejected manifest doesn't complete the proposal
+	handleChunkTestEntries(t, s, pb.Entry{Index: c1[0].Index, Term: 1})
+	handleChunkTestEntries(t, s, c1[1:]...)
+	handleChunkTestEntries(t, s, m1)
+	if !nodeProxy.rejected || len(store.updates) != 0 {
+		t.Fatalf("incomplete chunked proposal not rejected")
+	}
+	// the retried proposal is applied
+	c2, m2 := getChunkTestEntries(2, p1, m1.Index+1, 1, session)
+	handleChunkTestEntries(t, s, c2...)
+	handleChunkTestEntries(t, s, m2)
+	if nodeProxy.rejected || len(store.updates) != 1 {
+		t.Fatalf("chunked proposal not applied")
+	}
+	// the proposal retried again is not applied again, its chunks are dropped
+	c3, m3 := getChunkTestEntries(3, p1, m2.Index+1, 1, session)
+	handleChunkTestEntries(t, s, c3...)
+	handleChunkTestEntries(t, s, m3)
+	if nodeProxy.rejected || nodeProxy.ignored || len(store.updates) != 1 {
+		t.Fatalf("chunked proposal applied again")
+	}
+	if nodeProxy.smResult.Value != 1 {
+		t.Errorf("unexpected result %v", nodeProxy.smResult)
+	}
+	if len(s.sessions.chunks.streams) != 0 {
+		t.Errorf("chunk stream not removed")
+	}
+}
+
+func TestChunkStreamsAreLimited(t *testing.T) {
+	s, _, _ := newChunkTestStateMachine()
+	session := &client.Session{ClientID: 200, SeriesID: client.NoOPSeriesID}
+	index := uint64(1)
+	for i := uint64(1); i <= settings.MaxChunkStreams+1; i++ {
+		chunks, _ := getChunkTestEntries(i,
+			getChunkTestPayload(200), index, 1, session)
+		handleChunkTestEntries(t, s, chunks[0])
+		index++
+	}
+	streams := s.sessions.chunks.streams
+	if uint64(len(streams)) != settings.MaxChunkStreams {
+		t.Fatalf("%d streams", len(streams))
+	}
+	if _, ok := streams[1]; ok {
+		t.Errorf("least recently active stream not discarded")
+	}
+}
+
+func TestDeadChunkStreamsAreNotSaved(t *testing.T) {
+	ds := newSessionManager(0)
+	expected := &bytes.Buffer{}
+	if err := ds.lru.save(expected); err != nil {
+		t.Fatalf("save failed %v", err)
+	}
+	ss := &bytes.Buffer{}
+	if err := ds.saveSessions(ss, 100, 1); err != nil {
+		t.Fatalf("save failed %v", err)
+	}
+	if !bytes.Equal(expected.Bytes(), ss.Bytes()) {
+		t.Fatalf("saved sessions changed")
+	}
+	session := &client.Session{ClientID: 200, SeriesID: client.NoOPSeriesID}
+	p1 := getChunkTestPayload(200)
+	c1, m1 := getChunkTestEntries(1, p1, 1, 1, session)
+	c2, _ := getChunkTestEntries(2, p1, m1.Index+1, 1, session)
+	c3, _ := getChunkTestEntries(3, p1, 1000, 2, session)
+	for _, e := range append(append(c1, c2[0]), c3[0]) {
+		if err := ds.addChunk(e); err != nil {
+			t.Fatalf("failed to add chunk %v", err)
+		}
+	}
+	// the incomplete stream 2 is dead in term 2, the stream 3 is dead once
+	// its TTL expires
+	ss.Reset()
+	if err := ds.saveSessions(ss, 1001, 2); err != nil {
+		t.Fatalf("save failed %v", err)
+	}
+	loaded := newSessionManager(0)
+	if err := loaded.LoadSessions(bytes.NewReader(ss.Bytes()), V2); err != nil {
+		t.Fatalf("load failed %v", err)
+	}
+	if len(loaded.chunks.streams) != 2 {
+		t.Fatalf("%d streams saved, want 2", len(loaded.chunks.streams))
+	}
+	m1.Term = 2
+	m1.Index = 1002
+	if payload, ok := loaded.takeChunks(m1); !ok || !bytes.Equal(payload, p1) {
+		t.Errorf("failed to reassemble restored chunks")
+	}
+	ss.Reset()
+	index := 1000 + settings.ChunkStreamTTLEntries + 1
+	if err := loaded.saveSessions(ss, index, 2); err != nil {
+		t.Fatalf("save failed %v", err)
+	}
+	if !bytes.Equal(expected.Bytes(), ss.Bytes()) {
+		t.Errorf("dead chunk streams saved")
+	}
+	err := loaded.LoadSessions(bytes.NewReader(ss.Bytes()), V2)
+	if err != nil || len(loaded.chunks.streams) != 0 {
+		t.Errorf("unexpected streams, %v", err)
+	}
+}
+
+func TestChunkAssemblerReassemblesObservedProposals(t *testing.T) {
+	session := &client.Session{ClientID: 200, SeriesID: client.NoOPSeriesID}
+	payload := getChunkTestPayload(1000)
+	chunks, manifest := getChunkTestEntries(1, payload, 1, 1, session)
+	if !IsChunkManifest(manifest) || IsChunkManifest(chunks[0]) {
+		t.Fatalf("manifest not identified")
+	}
+	a := &ChunkAssembler{}
+	for _, e := range chunks {
+		if err := a.Add(e); err != nil {
+			t.Fatalf("failed to add chunk %v", err)
+		}
+	}
+	result, ok, observed := a.Take(manifest)
+	if !ok || !observed || !bytes.Equal(result, payload) {
+		t.Errorf("unexpected result, ok %t, observed %t", ok, observed)
+	}
+	// the first chunk is not observed
+	a = &ChunkAssembler{}
+	for _, e := range chunks[1:] {
+		if err := a.Add(e); err != nil {
+			t.Fatalf("failed to add chunk %v", err)
+		}
+	}
+	if _, ok, observed := a.Take(manifest); ok || observed {
+		t.Errorf("unexpected result, ok %t, observed %t", ok, observed)
+	}
+	// lost chunks are observed as such
+	a = &ChunkAssembler{}
+	for _, e := range append(chunks[:3:3], chunks[4:]...) {
+		if err := a.Add(e); err != nil {
+			t.Fatalf("failed to add chunk %v", err)
+		}
+	}
+	if _, ok, observed := a.Take(manifest); ok || !observed {
+		t.Errorf("unexpected result, ok %t, observed %t", ok, observed)
+	}
+	if len(a.started) != 0 {
+		t.Errorf("started streams not removed")
+	}
+}
@@ -15,11 +15,8 @@
 package rsm
 
 import (
-	"encoding/binary"
 	"io"
-	"time"
 
-	"github.com/lni/dragonboat/v4/internal/fileutil"
 	"github.com/lni/dragonboat/v4/internal/server"
 	"github.com/lni/dragonboat/v4/internal/settings"
 	"github.com/lni/dragonboat/v4/raftio"
@@ -111,24 +108,7 @@ func (cw *ChunkWriter) onNewChunk(chunk pb.Chunk) error {
 }
 
 func (cw *ChunkWriter) getHeader() []byte {
-	header := pb.SnapshotHeader{
-		SessionSize:     0,
-		DataStoreSize:   0,
-		UnreliableTime:  uint64(time.Now().UnixNano()),
-		PayloadChecksum: []byte{0, 0, 0, 0},
-		ChecksumType:    DefaultChecksumType,
-		Version:         uint64(V2),
-		CompressionType: cw.meta.CompressionType,
-	}
-	data := pb.MustMarshal(&header)
-	h := newCRC32Hash()
-	fileutil.MustWrite(h, data)
-	checksum := h.Sum(nil)
-	result := make([]byte, HeaderSize)
-	binary.LittleEndian.PutUint64(result, uint64(len(data)))
-	copy(result[8:], data)
-	copy(result[8+len(data):], checksum)
-	return result
+	return getV2Header(cw.meta.CompressionType)
 }
 
 func (cw *ChunkWriter) getChunk() pb.Chunk {
@@ -144,6 +124,7 @@ func (cw *ChunkWriter) getChunk() pb.Chunk {
 		Membership:  cw.meta.Membership,
 		BinVer:      raftio.TransportBinVersion,
 		Filepath:    server.GetSnapshotFilename(cw.meta.Index),
+		Fingerprint: cw.meta.Fingerprint,
 	}
 }
 
@@ -32,6 +32,12 @@ const (
 	EEHeaderSize uint8 = 1
 	EEVersion    uint8 = 0 << 4
 	EEV0         uint8 = 0 << 4
+	// EEChunked is the version of entries of chunked proposals, see chunked.go
+	// for details
+	EEChunked uint8 = 1 << 4
+	// EEFenced is the version of entries of proposals made with leader fences,
+	// see fenced.go for details
+	EEFenced uint8 = 2 << 4
 
 	// for V0 format, entries with empty payload will cause panic as such
 	// entries always have their TYPE value set to ApplicationEntry
@@ -127,6 +133,13 @@ func parseEncodedHeader(cmd []byte) (uint8, uint8, bool) {
 
 func getDecodedPayload(cmd []byte, buf []byte) ([]byte, error) {
 	ver, ct, hasSession := parseEncodedHeader(cmd)
+	if ver == EEFenced {
+		_, encoded := parseFenced(cmd)
+		if len(encoded) == 0 {
+			return nil, nil
+		}
+		return getDecodedPayload(encoded, buf)
+	}
 	if ver == EEV0 {
 		if hasSession {
 			plog.Panicf("v0 cmd has session info")
@@ -0,0 +1,84 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// Proposals made with a leader fence carry the term in which the fence was
+// acquired. Such entry is rejected when it is appended to the log in any other
+// term, which is known to every replica when applying the entry.
+//
+// Entry Cmd format of fenced entries, the payload is v0 encoded.
+//
+// --------------------------------
+// |Header|Term   |Payload        |
+// |1Byte |Uvarint|Remaining Bytes|
+// --------------------------------
+
+// fenceExpiredData is the data of the result of fenced entries rejected as
+// they were appended in a term other than the one of their fences.
+var fenceExpiredData = []byte("leader fence expired")
+
+// FenceExpiredResult returns the result of fenced entries rejected as their
+// fences expired.
+func FenceExpiredResult() sm.Result {
+	return sm.Result{Data: fenceExpiredData}
+}
+
+// IsFenceExpiredResult returns a boolean value indicating whether the result
+// is the one of a fenced entry rejected as its fence expired.
+func IsFenceExpiredResult(result sm.Result) bool {
+	return result.Value == 0 && bytes.Equal(result.Data, fenceExpiredData)
+}
+
+// GetFenced returns the encoded Cmd of the fenced entry, encoded is the v0
+// encoded payload of the proposal or nil when the payload is empty.
+func GetFenced(term uint64, encoded []byte) []byte {
+	buf := make([]byte, 0, 1+binary.MaxVarintLen64+len(encoded))
+	buf = append(buf, getEncodedHeader(EEFenced, EENoCompression, false))
+	buf = binary.AppendUvarint(buf, term)
+	return append(buf, encoded...)
+}
+
+// IsFencedEntry returns a boolean value indicating whether the entry is a
+// fenced entry.
+func IsFencedEntry(e pb.Entry) bool {
+	if e.Type != pb.EncodedEntry || len(e.Cmd) == 0 {
+		return false
+	}
+	ver, _, _ := parseEncodedHeader(e.Cmd)
+	return ver == EEFenced
+}
+
+// fenceExpired returns a boolean value indicating whether the fenced entry
+// was appended in a term other than the one of its fence.
+func fenceExpired(e pb.Entry) bool {
+	term, _ := parseFenced(e.Cmd)
+	return term != e.Term
+}
+
+func parseFenced(cmd []byte) (uint64, []byte) {
+	term, n := binary.Uvarint(cmd[EEHeaderSize:])
+	if n <= 0 {
+		plog.Panicf("invalid fenced entry")
+	}
+	return term, cmd[int(EEHeaderSize)+n:]
+}
@@ -0,0 +1,104 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/internal/utils/dio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func getFencedTestEntry(ct dio.CompressionType,
+	fenceTerm uint64, index uint64, term uint64, payload []byte) pb.Entry {
+	return pb.Entry{
+		Type:     pb.EncodedEntry,
+		Key:      index,
+		Index:    index,
+		Term:     term,
+		ClientID: 100,
+		SeriesID: client.NoOPSeriesID,
+		Cmd:      GetFenced(fenceTerm, GetEncoded(ct, payload, nil)),
+	}
+}
+
+func TestFencedPayloadCanBeEncoded(t *testing.T) {
+	for _, ct := range []dio.CompressionType{dio.NoCompression, dio.Snappy} {
+		payload := getChunkTestPayload(1000)
+		e := getFencedTestEntry(ct, 300, 1, 1, payload)
+		if !IsFencedEntry(e) || IsChunkedEntry(e) {
+			t.Fatalf("not a fenced entry")
+		}
+		if term, _ := parseFenced(e.Cmd); term != 300 {
+			t.Errorf("term %d, want 300", term)
+		}
+		result, err := GetPayload(e)
+		if err != nil {
+			t.Fatalf("failed to decode %v", err)
+		}
+		if !bytes.Equal(result, payload) {
+			t.Errorf("payload changed")
+		}
+		regular := pb.Entry{Type: pb.EncodedEntry,
+			Cmd: GetEncoded(ct, payload, nil)}
+		if IsFencedEntry(regular) {
+			t.Errorf("regular entry considered as fenced")
+		}
+	}
+}
+
+func TestFencedEntryIsAppliedInItsTerm(t *testing.T) {
+	s, store, nodeProxy := newChunkTestStateMachine()
+	payload := getChunkTestPayload(100)
+	handleChunkTestEntries(t, s, getFencedTestEntry(dio.Snappy, 2, 1, 2, payload))
+	if len(store.updates) != 1 || !bytes.Equal(store.updates[0].Cmd, payload) {
+		t.Fatalf("fenced entry not applied")
+	}
+	if nodeProxy.rejected || nodeProxy.smResult.Value != 1 {
+		t.Errorf("unexpected result %v", nodeProxy.smResult)
+	}
+}
+
+func TestFencedEntryFromOtherTermIsRejected(t *testing.T) {
+	s, store, nodeProxy := newChunkTestStateMachine()
+	payload := getChunkTestPayload(100)
+	handleChunkTestEntries(t, s, getFencedTestEntry(dio.Snappy, 2, 1, 3, payload))
+	if len(store.updates) != 0 {
+		t.Fatalf("expired fenced entry applied")
+	}
+	if !nodeProxy.rejected || !IsFenceExpiredResult(nodeProxy.smResult) {
+		t.Errorf("fenced entry not rejected, %v", nodeProxy.smResult)
+	}
+	if s.index != 1 {
+		t.Errorf("unexpected applied index %d", s.index)
+	}
+}
+
+func TestFencedEntriesAreNotBatched(t *testing.T) {
+	regular := getFencedTestEntry(dio.NoCompression, 1, 1, 1, []byte("test-data"))
+	regular.Cmd = GetEncoded(dio.NoCompression, []byte("test-data"), nil)
+	entries := []pb.Entry{
+		regular,
+		getFencedTestEntry(dio.NoCompression, 1, 2, 1, []byte("test-data")),
+	}
+	if allUpdate, _ := getEntryTypes(entries); allUpdate {
+		t.Errorf("fenced entry batched")
+	}
+	if allUpdate, _ := getEntryTypes(entries[:1]); !allUpdate {
+		t.Errorf("regular entry not batched")
+	}
+}
@@ -15,9 +15,12 @@
 package rsm
 
 import (
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 
+	"github.com/lni/dragonboat/v4/internal/vfs"
 	pb "github.com/lni/dragonboat/v4/raftpb"
 )
 
@@ -82,8 +85,56 @@ func (fc *Files) PrepareFiles(tmpdir string,
 			plog.Panicf("empty file found, id %d",
 				file.FileId)
 		}
+		checksum, err := GetFileChecksum(fp, vfs.DefaultFS)
+		if err != nil {
+			return nil, err
+		}
 		file.Filepath = filepath.Join(finaldir, fn)
 		file.FileSize = uint64(fi.Size())
+		file.Checksum = checksum
+	}
+	return fc.files, nil
+}
+
+// ExportFiles copies the external files added to the collection to the
+// specified sink. The Filepath of each exported file is set to its name in
+// the sink, which is in the specified dir.
+func (fc *Files) ExportFiles(dir string,
+	sink IExportSink) ([]*pb.SnapshotFile, error) {
+	for _, file := range fc.files {
+		fn := path.Join(dir, file.Filename())
+		sz, checksum, err := exportFile(file.Filepath, fn, sink)
+		if err != nil {
+			return nil, err
+		}
+		if sz == 0 {
+			plog.Panicf("empty file found, id %d",
+				file.FileId)
+		}
+		file.Filepath = fn
+		file.FileSize = sz
+		file.Checksum = checksum
 	}
 	return fc.files, nil
 }
+
+func exportFile(fp string,
+	name string, sink IExportSink) (sz uint64, checksum []byte, err error) {
+	in, err := os.Open(fp)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		err = firstError(err, in.Close())
+	}()
+	out, err := sink.CreateFile(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		err = firstError(err, out.Close())
+	}()
+	h := getDefaultChecksum()
+	n, err := io.Copy(io.MultiWriter(out, h), in)
+	return uint64(n), h.Sum(nil), err
+}
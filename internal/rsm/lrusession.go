@@ -30,6 +30,11 @@ import (
 const (
 	// EmptyClientSessionLength defines the length of an empty sessions instance.
 	EmptyClientSessionLength uint64 = 16
+	// sessionFlagMask is the mask of flags saved along with the size of the
+	// lrusession, e.g. hasChunkStreams.
+	sessionFlagMask uint64 = 0xFF << 56
+	// hasChunkStreams indicates that chunk streams are saved after sessions.
+	hasChunkStreams uint64 = 1 << 63
 )
 
 var (
@@ -88,9 +93,28 @@ func (rec *lrusession) getSession(key RaftClientID) (*Session, bool) {
 	return rec.getSessionLocked(key)
 }
 
+// getOldestSession returns the least recently used client session.
+func (rec *lrusession) getOldestSession() (*Session, bool) {
+	rec.Lock()
+	defer rec.Unlock()
+	var oldest *Session
+	rec.sessions.OrderedDo(func(k, v interface{}) {
+		if oldest == nil {
+			oldest = v.(*Session)
+		}
+	})
+	return oldest, oldest != nil
+}
+
 // Save checkpoints the state of the lrusession and save the checkpointed
 // state into the writer.
 func (rec *lrusession) save(writer io.Writer) error {
+	return rec.saveWithFlags(writer, 0)
+}
+
+// saveWithFlags is similar to save, the specified flags are saved along with
+// the size of the lrusession.
+func (rec *lrusession) saveWithFlags(writer io.Writer, flags uint64) error {
 	rec.Lock()
 	defer rec.Unlock()
 	idList := make([]RaftClientID, 0)
@@ -99,7 +123,7 @@ func (rec *lrusession) save(writer io.Writer) error {
 		idList = append(idList, *key)
 	})
 	totalbuf := make([]byte, 8)
-	binary.LittleEndian.PutUint64(totalbuf, rec.size)
+	binary.LittleEndian.PutUint64(totalbuf, rec.size|flags)
 	if _, err := writer.Write(totalbuf); err != nil {
 		return err
 	}
@@ -122,23 +146,33 @@ func (rec *lrusession) save(writer io.Writer) error {
 // Load restores the state the of lrusession from the provided reader.
 // reader contains lrusession state previously checkpointed.
 func (rec *lrusession) load(reader io.Reader, v SSVersion) error {
+	_, err := rec.loadWithFlags(reader, v)
+	return err
+}
+
+// loadWithFlags is similar to load, it returns the flags saved by
+// saveWithFlags.
+func (rec *lrusession) loadWithFlags(reader io.Reader,
+	v SSVersion) (uint64, error) {
 	rec.Lock()
 	defer rec.Unlock()
 	sessionList := make([]*Session, 0)
 	sizebuf := make([]byte, 8)
 	if _, err := io.ReadFull(reader, sizebuf); err != nil {
-		return err
+		return 0, err
 	}
 	sz := binary.LittleEndian.Uint64(sizebuf)
+	flags := sz & sessionFlagMask
+	sz = sz &^ sessionFlagMask
 	if _, err := io.ReadFull(reader, sizebuf); err != nil {
-		return err
+		return 0, err
 	}
 	total := binary.LittleEndian.Uint64(sizebuf)
 	for i := uint64(0); i < total; i++ {
 		s := &Session{}
 		err := s.recoverFromSnapshot(reader, v)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		sessionList = append(sessionList, s)
 	}
@@ -148,7 +182,7 @@ func (rec *lrusession) load(reader io.Reader, v SSVersion) error {
 	for _, s := range sessionList {
 		rec.addSessionLocked(s.ClientID, *s)
 	}
-	return nil
+	return flags, nil
 }
 
 func (rec *lrusession) makeEntry(key RaftClientID,
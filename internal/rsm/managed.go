@@ -64,6 +64,8 @@ type IManagedStateMachine interface {
 	NAConcurrentLookup([]byte) ([]byte, error)
 	Sync() error
 	GetHash() (uint64, error)
+	Fingerprint() (uint64, error)
+	NonRetaining() bool
 	Prepare() (interface{}, error)
 	Save(SSMeta, io.Writer, []byte, sm.ISnapshotFileCollection) (bool, error)
 	Recover(io.Reader, []sm.SnapshotFile) error
@@ -246,6 +248,19 @@ func (ds *NativeSM) GetHash() (uint64, error) {
 	return ds.sm.GetHash()
 }
 
+// Fingerprint returns the fingerprint of the data store, see
+// sm.IFingerprint for details.
+func (ds *NativeSM) Fingerprint() (uint64, error) {
+	return ds.sm.Fingerprint()
+}
+
+// NonRetaining returns a boolean flag indicating whether the data store never
+// retains the Cmd of applied entries, see sm.INonRetainingStateMachine for
+// details.
+func (ds *NativeSM) NonRetaining() bool {
+	return ds.sm.NonRetaining()
+}
+
 // Prepare makes preparation for concurrently taking snapshot.
 func (ds *NativeSM) Prepare() (interface{}, error) {
 	return ds.sm.Prepare()
@@ -59,6 +59,8 @@ func (d *dummySM) Save(interface{},
 func (d *dummySM) Recover(io.Reader, []sm.SnapshotFile, <-chan struct{}) error { return nil }
 func (d *dummySM) Close() error                                                { return nil }
 func (d *dummySM) GetHash() (uint64, error)                                    { return 0, nil }
+func (d *dummySM) Fingerprint() (uint64, error)                                { return 0, nil }
+func (d *dummySM) NonRetaining() bool                                          { return false }
 func (d *dummySM) Concurrent() bool                                            { return false }
 func (d *dummySM) OnDisk() bool                                                { return false }
 func (d *dummySM) Type() pb.StateMachineType                                   { return pb.OnDiskStateMachine }
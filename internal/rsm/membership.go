@@ -19,13 +19,30 @@ import (
 	"encoding/binary"
 	"sort"
 	"strings"
+	"time"
 
+	"github.com/cockroachdb/errors"
 	"github.com/lni/goutils/logutil"
 
 	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/settings"
+	"github.com/lni/dragonboat/v4/logger"
 	pb "github.com/lni/dragonboat/v4/raftpb"
 )
 
+var (
+	// ErrReplicaIDReused indicates that the config change is rejected as it
+	// adds a removed replica back to the shard.
+	ErrReplicaIDReused = errors.New("replica id reused")
+	// ErrAddressInUse indicates that the config change is rejected as the
+	// target address is used by another member of the shard.
+	ErrAddressInUse = errors.New("address in use")
+	// ErrMembershipTooLarge indicates that the config change is rejected as
+	// the resulting membership would have too many members or overlong member
+	// addresses.
+	ErrMembershipTooLarge = errors.New("membership too large")
+)
+
 func addressEqual(addr1 string, addr2 string) bool {
 	return strings.EqualFold(strings.TrimSpace(addr1),
 		strings.TrimSpace(addr2))
@@ -38,6 +55,9 @@ func deepCopyMembership(m pb.Membership) pb.Membership {
 		Removed:        make(map[uint64]bool),
 		NonVotings:     make(map[uint64]string),
 		Witnesses:      make(map[uint64]string),
+		Outgoing:       make(map[uint64]string),
+		Staged:         make(map[uint64]bool),
+		Retired:        make(map[string]uint64),
 	}
 	for nid, addr := range m.Addresses {
 		c.Addresses[nid] = addr
@@ -51,26 +71,106 @@ func deepCopyMembership(m pb.Membership) pb.Membership {
 	for nid, addr := range m.Witnesses {
 		c.Witnesses[nid] = addr
 	}
+	for nid, addr := range m.Outgoing {
+		c.Outgoing[nid] = addr
+	}
+	for nid, v := range m.Staged {
+		c.Staged[nid] = v
+	}
+	for addr, nid := range m.Retired {
+		c.Retired[addr] = nid
+	}
+	if len(m.History) > 0 {
+		c.History = make([]pb.ConfigChangeRecord, len(m.History))
+		copy(c.History, m.History)
+	}
+	c.PrunedRemovedCount = m.PrunedRemovedCount
+	c.PrunedRemovedHash = m.PrunedRemovedHash
+	c.PrunedRemovedMax = m.PrunedRemovedMax
+	c.ProtocolVersion = m.ProtocolVersion
 	return c
 }
 
+// ExceedsMembershipLimits returns a boolean value indicating whether the
+// membership resulted from applying the config change would have more than
+// settings.MaxMembers members or member addresses longer than
+// settings.MaxAddressLength bytes. Config changes initializing the shard are
+// never considered as exceeding the limits.
+func ExceedsMembershipLimits(m pb.Membership, cc pb.ConfigChange) bool {
+	if cc.Initialize {
+		return false
+	}
+	isMember := func(nid uint64) bool {
+		for _, members := range []map[uint64]string{m.Addresses,
+			m.NonVotings, m.Witnesses} {
+			if _, ok := members[nid]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	count := len(m.Addresses) + len(m.NonVotings) + len(m.Witnesses)
+	switch cc.Type {
+	case pb.AddNode, pb.AddNonVoting, pb.AddWitness:
+		if uint64(len(cc.Address)) > settings.MaxAddressLength {
+			return true
+		}
+		if !isMember(cc.ReplicaID) {
+			count++
+		}
+	case pb.UpdateAddress, pb.ReplaceWitness:
+		return uint64(len(cc.Address)) > settings.MaxAddressLength
+	case pb.EnterJoint:
+		for nid, addr := range cc.Members {
+			if uint64(len(addr)) > settings.MaxAddressLength {
+				return true
+			}
+			if !isMember(nid) {
+				count++
+			}
+		}
+	default:
+		return false
+	}
+	return uint64(count) > settings.MaxMembers
+}
+
+// mixReplicaID returns the splitmix64 hash of the replica ID, the hash values
+// of pruned removed replica IDs are summed so the result doesn't depend on
+// the order in which they are pruned.
+func mixReplicaID(v uint64) uint64 {
+	v += 0x9E3779B97F4A7C15
+	v = (v ^ (v >> 30)) * 0xBF58476D1CE4E5B9
+	v = (v ^ (v >> 27)) * 0x94D049BB133111EB
+	return v ^ (v >> 31)
+}
+
+const (
+	defaultConfigChangeHistorySize uint64 = 64
+)
+
 type membership struct {
-	members   pb.Membership
-	shardID   uint64
-	replicaID uint64
-	ordered   bool
+	members     pb.Membership
+	shardID     uint64
+	replicaID   uint64
+	historySize uint64
+	ordered     bool
 }
 
 func newMembership(shardID uint64, replicaID uint64, ordered bool) membership {
 	return membership{
-		shardID:   shardID,
-		replicaID: replicaID,
-		ordered:   ordered,
+		shardID:     shardID,
+		replicaID:   replicaID,
+		historySize: defaultConfigChangeHistorySize,
+		ordered:     ordered,
 		members: pb.Membership{
 			Addresses:  make(map[uint64]string),
 			NonVotings: make(map[uint64]string),
 			Removed:    make(map[uint64]bool),
 			Witnesses:  make(map[uint64]string),
+			Outgoing:   make(map[uint64]string),
+			Staged:     make(map[uint64]bool),
+			Retired:    make(map[string]uint64),
 		},
 	}
 }
@@ -87,6 +187,52 @@ func (m *membership) get() pb.Membership {
 	return deepCopyMembership(m.members)
 }
 
+// record adds the applied config change to the history. the timestamp is the
+// local time when the config change is applied, it is not part of the hash as
+// it is not expected to be the same on all replicas.
+func (m *membership) record(cc pb.ConfigChange, index uint64, term uint64) {
+	m.members.History = append(m.members.History, pb.ConfigChangeRecord{
+		Index:     index,
+		Term:      term,
+		Type:      cc.Type,
+		ReplicaID: cc.ReplicaID,
+		Address:   cc.Address,
+		Timestamp: time.Now().UnixNano(),
+	})
+	if uint64(len(m.members.History)) > m.historySize {
+		drop := uint64(len(m.members.History)) - m.historySize
+		m.members.History = append([]pb.ConfigChangeRecord{},
+			m.members.History[drop:]...)
+	}
+}
+
+// pruneRemoved keeps at most limit replica IDs in Removed. The smallest
+// removed replica IDs are pruned first, they are summarized by the pruned
+// count, the sum of their hash values and the largest pruned replica ID, see
+// pb.Membership.IsRemoved. The limit is specified by the leader in the config
+// change so all replicas prune the same replica IDs.
+func (m *membership) pruneRemoved(limit uint64) {
+	if limit == 0 || uint64(len(m.members.Removed)) <= limit {
+		return
+	}
+	removed := make([]uint64, 0, len(m.members.Removed))
+	for id := range m.members.Removed {
+		removed = append(removed, id)
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+	pruned := removed[:uint64(len(removed))-limit]
+	for _, id := range pruned {
+		delete(m.members.Removed, id)
+		m.members.PrunedRemovedCount++
+		m.members.PrunedRemovedHash += mixReplicaID(id)
+		if id > m.members.PrunedRemovedMax {
+			m.members.PrunedRemovedMax = id
+		}
+	}
+	plog.Infof("%s pruned %d removed replica IDs, largest %s",
+		m.id(), len(pruned), nid(m.members.PrunedRemovedMax))
+}
+
 func (m *membership) getHash() uint64 {
 	vals := make([]uint64, 0)
 	for v := range m.members.Addresses {
@@ -94,6 +240,22 @@ func (m *membership) getHash() uint64 {
 	}
 	sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
 	vals = append(vals, m.members.ConfigChangeId)
+	if m.members.IsJoint() {
+		outgoing := make([]uint64, 0, len(m.members.Outgoing))
+		for v := range m.members.Outgoing {
+			outgoing = append(outgoing, v)
+		}
+		sort.Slice(outgoing, func(i, j int) bool { return outgoing[i] < outgoing[j] })
+		vals = append(vals, outgoing...)
+	}
+	if len(m.members.Staged) > 0 {
+		staged := make([]uint64, 0, len(m.members.Staged))
+		for v := range m.members.Staged {
+			staged = append(staged, v)
+		}
+		sort.Slice(staged, func(i, j int) bool { return staged[i] < staged[j] })
+		vals = append(vals, staged...)
+	}
 	data := make([]byte, 8)
 	hash := md5.New()
 	for _, v := range vals {
@@ -109,25 +271,79 @@ func (m *membership) isEmpty() bool {
 }
 
 func (m *membership) isUpToDate(cc pb.ConfigChange) bool {
-	if !m.ordered || cc.Initialize {
+	// LeaveJoint is proposed by the raft leader on its own
+	if !m.ordered || cc.Initialize || cc.Type == pb.LeaveJoint {
 		return true
 	}
 	if m.members.ConfigChangeId == cc.ConfigChangeId {
 		return true
 	}
+	// promotions of staged non-voting members are proposed by the raft leader
+	// on its own
+	if cc.Type == pb.AddNode && cc.Staged && m.members.Staged[cc.ReplicaID] {
+		return true
+	}
 	return false
 }
 
 func (m *membership) isAddRemovedNode(cc pb.ConfigChange) bool {
 	if cc.Type == pb.AddNode ||
 		cc.Type == pb.AddNonVoting ||
-		cc.Type == pb.AddWitness {
-		_, ok := m.members.Removed[cc.ReplicaID]
-		return ok
+		cc.Type == pb.AddWitness ||
+		cc.Type == pb.ReplaceWitness {
+		return m.members.IsRemoved(cc.ReplicaID) &&
+			!(cc.AllowReuse && isVersioned(cc))
+	}
+	return false
+}
+
+// isVersioned returns a boolean value indicating whether the config change is
+// stamped by the leader with a protocol version supported by all members.
+// Rejection rules introduced by later versions are only applied to stamped
+// config changes so replicas running older versions, which don't apply them,
+// always make the same decisions.
+func isVersioned(cc pb.ConfigChange) bool {
+	return cc.ProtocolVersion > 0
+}
+
+// isAddressInUse returns a boolean value indicating whether the target address
+// of the config change is used by another member.
+func (m *membership) isAddressInUse(cc pb.ConfigChange) bool {
+	if cc.Type != pb.AddNode &&
+		cc.Type != pb.AddNonVoting &&
+		cc.Type != pb.AddWitness &&
+		cc.Type != pb.UpdateAddress {
+		return false
+	}
+	for _, members := range []map[uint64]string{m.members.Addresses,
+		m.members.NonVotings, m.members.Witnesses} {
+		for nid, addr := range members {
+			if nid != cc.ReplicaID && addressEqual(addr, cc.Address) {
+				return true
+			}
+		}
 	}
 	return false
 }
 
+// getRejectionReason returns the error describing why the config change is
+// rejected, nil is returned when there is no specific reason to report.
+func (m *membership) getRejectionReason(cc pb.ConfigChange) error {
+	if !m.isUpToDate(cc) {
+		return nil
+	}
+	if m.isAddRemovedNode(cc) {
+		return ErrReplicaIDReused
+	}
+	if m.isAddressInUse(cc) {
+		return ErrAddressInUse
+	}
+	if isVersioned(cc) && ExceedsMembershipLimits(m.members, cc) {
+		return ErrMembershipTooLarge
+	}
+	return nil
+}
+
 func (m *membership) isPromoteNonVoting(cc pb.ConfigChange) bool {
 	if cc.Type == pb.AddNode {
 		oa, ok := m.members.NonVotings[cc.ReplicaID]
@@ -164,6 +380,21 @@ func (m *membership) isAddExistingMember(cc pb.ConfigChange) bool {
 			return true
 		}
 	}
+	if cc.Type == pb.ReplaceWitness {
+		if _, ok := m.getAddress(cc.ReplicaID); ok {
+			return true
+		}
+		// the new witness can use the address of the witness it replaces
+		for _, members := range []map[uint64]string{m.members.Addresses,
+			m.members.NonVotings, m.members.Witnesses} {
+			for nid, addr := range members {
+				if nid != cc.ReplacedID && addressEqual(addr, cc.Address) {
+					return true
+				}
+			}
+		}
+		return false
+	}
 	if m.isPromoteNonVoting(cc) {
 		return false
 	}
@@ -228,6 +459,62 @@ func (m *membership) isAddNonVotingAsWitness(cc pb.ConfigChange) bool {
 	return false
 }
 
+func (m *membership) isInvalidWitnessPromotion(cc pb.ConfigChange) bool {
+	if cc.Type == pb.PromoteWitness {
+		_, ok := m.members.Witnesses[cc.ReplicaID]
+		return !ok
+	}
+	return false
+}
+
+// isInvalidWitnessReplacement returns a boolean value indicating whether the
+// ReplaceWitness config change is invalid. The replaced member must be a
+// witness and the new witness must have a non-empty address.
+func (m *membership) isInvalidWitnessReplacement(cc pb.ConfigChange) bool {
+	if cc.Type != pb.ReplaceWitness {
+		return false
+	}
+	if _, ok := m.members.Witnesses[cc.ReplacedID]; !ok {
+		return true
+	}
+	return cc.ReplacedID == cc.ReplicaID ||
+		len(strings.TrimSpace(cc.Address)) == 0
+}
+
+// getAddress returns the address of the specified member regardless of its
+// role.
+func (m *membership) getAddress(replicaID uint64) (string, bool) {
+	for _, members := range []map[uint64]string{m.members.Addresses,
+		m.members.NonVotings, m.members.Witnesses} {
+		if addr, ok := members[replicaID]; ok {
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+// isInvalidAddressUpdate returns a boolean value indicating whether the
+// UpdateAddress config change is invalid. The target must be a current member
+// and the new address can't be its current address or any address it used
+// before, addresses retired by a replica are never accepted for it again so a
+// stale process left running on the old address can't be mistaken for it.
+func (m *membership) isInvalidAddressUpdate(cc pb.ConfigChange) bool {
+	if cc.Type != pb.UpdateAddress {
+		return false
+	}
+	oa, ok := m.getAddress(cc.ReplicaID)
+	if !ok || addressEqual(oa, cc.Address) ||
+		len(strings.TrimSpace(cc.Address)) == 0 {
+		return true
+	}
+	for addr, nid := range m.members.Retired {
+		if nid == cc.ReplicaID && addressEqual(addr, cc.Address) {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *membership) isDeleteOnlyNode(cc pb.ConfigChange) bool {
 	if cc.Type == pb.RemoveNode && len(m.members.Addresses) == 1 {
 		_, ok := m.members.Addresses[cc.ReplicaID]
@@ -236,12 +523,88 @@ func (m *membership) isDeleteOnlyNode(cc pb.ConfigChange) bool {
 	return false
 }
 
+// isChangingJoint returns a boolean value indicating whether the config change
+// is requested when the membership is in a joint configuration. The only
+// config change allowed in a joint configuration is LeaveJoint.
+func (m *membership) isChangingJoint(cc pb.ConfigChange) bool {
+	return m.members.IsJoint() && cc.Type != pb.LeaveJoint
+}
+
+func (m *membership) isInvalidLeaveJoint(cc pb.ConfigChange) bool {
+	return cc.Type == pb.LeaveJoint && !m.members.IsJoint()
+}
+
+// isInvalidEnterJoint returns a boolean value indicating whether the target
+// regular nodes of the EnterJoint config change are invalid.
+func (m *membership) isInvalidEnterJoint(cc pb.ConfigChange) bool {
+	if cc.Type != pb.EnterJoint {
+		return false
+	}
+	if len(cc.Members) == 0 {
+		return true
+	}
+	changed := len(cc.Members) != len(m.members.Addresses)
+	for nid, addr := range cc.Members {
+		if m.members.IsRemoved(nid) {
+			return true
+		}
+		if _, ok := m.members.Witnesses[nid]; ok {
+			return true
+		}
+		if oa, ok := m.members.Addresses[nid]; ok {
+			if !addressEqual(oa, addr) {
+				return true
+			}
+			continue
+		}
+		changed = true
+		if oa, ok := m.members.NonVotings[nid]; ok {
+			if !addressEqual(oa, addr) {
+				return true
+			}
+			continue
+		}
+		// new node, its address can't be used by any other node
+		for onid, oa := range cc.Members {
+			if onid != nid && addressEqual(oa, addr) {
+				return true
+			}
+		}
+		for _, members := range []map[uint64]string{m.members.Addresses,
+			m.members.NonVotings, m.members.Witnesses} {
+			for _, oa := range members {
+				if addressEqual(oa, addr) {
+					return true
+				}
+			}
+		}
+	}
+	return !changed
+}
+
+// getLeaving returns regular nodes that will be removed when leaving the
+// joint configuration.
+func (m *membership) getLeaving() map[uint64]string {
+	result := make(map[uint64]string)
+	for nid, addr := range m.members.Outgoing {
+		if _, ok := m.members.Addresses[nid]; !ok {
+			result[nid] = addr
+		}
+	}
+	return result
+}
+
 func (m *membership) apply(cc pb.ConfigChange, index uint64) {
 	m.members.ConfigChangeId = index
+	versioned := isVersioned(cc)
+	if cc.AllowReuse && versioned {
+		delete(m.members.Removed, cc.ReplicaID)
+	}
 	switch cc.Type {
 	case pb.AddNode:
 		nodeAddr := cc.Address
 		delete(m.members.NonVotings, cc.ReplicaID)
+		delete(m.members.Staged, cc.ReplicaID)
 		if _, ok := m.members.Witnesses[cc.ReplicaID]; ok {
 			panic("not suppose to reach here")
 		}
@@ -251,6 +614,9 @@ func (m *membership) apply(cc pb.ConfigChange, index uint64) {
 			panic("not suppose to reach here")
 		}
 		m.members.NonVotings[cc.ReplicaID] = cc.Address
+		if cc.Staged {
+			m.members.Staged[cc.ReplicaID] = true
+		}
 	case pb.AddWitness:
 		if _, ok := m.members.Addresses[cc.ReplicaID]; ok {
 			panic("not suppose to reach here")
@@ -263,10 +629,56 @@ func (m *membership) apply(cc pb.ConfigChange, index uint64) {
 		delete(m.members.Addresses, cc.ReplicaID)
 		delete(m.members.NonVotings, cc.ReplicaID)
 		delete(m.members.Witnesses, cc.ReplicaID)
+		delete(m.members.Staged, cc.ReplicaID)
 		m.members.Removed[cc.ReplicaID] = true
+	case pb.EnterJoint:
+		m.members.Outgoing = m.members.Addresses
+		m.members.Addresses = make(map[uint64]string)
+		for nid, addr := range cc.Members {
+			delete(m.members.NonVotings, nid)
+			delete(m.members.Staged, nid)
+			m.members.Addresses[nid] = addr
+		}
+	case pb.PromoteWitness:
+		nodeAddr, ok := m.members.Witnesses[cc.ReplicaID]
+		if !ok {
+			panic("not suppose to reach here")
+		}
+		delete(m.members.Witnesses, cc.ReplicaID)
+		m.members.Addresses[cc.ReplicaID] = nodeAddr
+	case pb.UpdateAddress:
+		oa, ok := m.getAddress(cc.ReplicaID)
+		if !ok {
+			panic("not suppose to reach here")
+		}
+		for _, members := range []map[uint64]string{m.members.Addresses,
+			m.members.NonVotings, m.members.Witnesses} {
+			if _, ok := members[cc.ReplicaID]; ok {
+				members[cc.ReplicaID] = cc.Address
+			}
+		}
+		m.members.Retired[oa] = cc.ReplicaID
+	case pb.ReplaceWitness:
+		if _, ok := m.members.Witnesses[cc.ReplacedID]; !ok {
+			panic("not suppose to reach here")
+		}
+		delete(m.members.Witnesses, cc.ReplacedID)
+		m.members.Removed[cc.ReplacedID] = true
+		m.members.Witnesses[cc.ReplicaID] = cc.Address
+	case pb.LeaveJoint:
+		for nid := range m.getLeaving() {
+			m.members.Removed[nid] = true
+		}
+		m.members.Outgoing = make(map[uint64]string)
 	default:
 		panic("unknown config change type")
 	}
+	if versioned {
+		m.pruneRemoved(cc.MaxRemoved)
+		if cc.ProtocolVersion > m.members.ProtocolVersion {
+			m.members.ProtocolVersion = cc.ProtocolVersion
+		}
+	}
 }
 
 var nid = logutil.ReplicaID
@@ -284,6 +696,17 @@ func (m *membership) handleConfigChange(cc pb.ConfigChange, index uint64) bool {
 	upToDateCC := m.isUpToDate(cc)
 	deleteOnlyNode := m.isDeleteOnlyNode(cc)
 	invalidPromotion := m.isInvalidNonVotingPromotion(cc)
+	invalidWitnessPromotion := m.isInvalidWitnessPromotion(cc)
+	invalidAddressUpdate := m.isInvalidAddressUpdate(cc)
+	invalidWitnessReplacement := m.isInvalidWitnessReplacement(cc)
+	addressInUse := cc.Type == pb.UpdateAddress && m.isAddressInUse(cc)
+	changingJoint := m.isChangingJoint(cc)
+	invalidEnterJoint := m.isInvalidEnterJoint(cc)
+	invalidLeaveJoint := m.isInvalidLeaveJoint(cc)
+	versioned := isVersioned(cc)
+	unsafeChange := versioned && len(cc.Inactive) > 0
+	limitExceeded := versioned && cc.LimitExceeded
+	tooLarge := versioned && upToDateCC && ExceedsMembershipLimits(m.members, cc)
 	accepted := upToDateCC &&
 		!addRemovedNode &&
 		!alreadyMember &&
@@ -293,22 +716,55 @@ func (m *membership) handleConfigChange(cc pb.ConfigChange, index uint64) bool {
 		!witnessBecomingNonVoting &&
 		!nonVotingBecomingWitness &&
 		!deleteOnlyNode &&
-		!invalidPromotion
+		!invalidPromotion &&
+		!invalidWitnessPromotion &&
+		!invalidAddressUpdate &&
+		!invalidWitnessReplacement &&
+		!addressInUse &&
+		!changingJoint &&
+		!invalidEnterJoint &&
+		!invalidLeaveJoint &&
+		!unsafeChange &&
+		!limitExceeded &&
+		!tooLarge
 	if accepted {
+		oa, _ := m.getAddress(cc.ReplicaID)
 		// current entry index, it will be recorded as the conf change id of the members
 		m.apply(cc, index)
+		fields := []logger.Field{
+			logger.ShardID(m.shardID),
+			logger.ReplicaID(m.replicaID),
+			logger.Uint64("ccid", ccid),
+			logger.Uint64("index", index),
+		}
+		target := []logger.Field{
+			logger.Uint64("target", cc.ReplicaID),
+			logger.String("address", cc.Address),
+		}
 		if cc.Type == pb.AddNode {
-			plog.Infof("%s applied ADD ccid %d (%d), %s (%s)",
-				m.id(), ccid, index, nid(cc.ReplicaID), cc.Address)
+			plog.Infow("applied ADD", append(fields, target...)...)
 		} else if cc.Type == pb.RemoveNode {
-			plog.Infof("%s applied REMOVE ccid %d (%d), %s",
-				m.id(), ccid, index, nid(cc.ReplicaID))
+			plog.Infow("applied REMOVE", append(fields, target[0])...)
 		} else if cc.Type == pb.AddNonVoting {
-			plog.Infof("%s applied ADD OBSERVER ccid %d (%d), %s (%s)",
-				m.id(), ccid, index, nid(cc.ReplicaID), cc.Address)
+			plog.Infow("applied ADD OBSERVER", append(fields,
+				append(target, logger.Any("staged", cc.Staged))...)...)
 		} else if cc.Type == pb.AddWitness {
-			plog.Infof("%s applied ADD WITNESS ccid %d (%d), %s (%s)",
-				m.id(), ccid, index, nid(cc.ReplicaID), cc.Address)
+			plog.Infow("applied ADD WITNESS", append(fields, target...)...)
+		} else if cc.Type == pb.PromoteWitness {
+			plog.Infow("applied PROMOTE WITNESS", append(fields, target[0],
+				logger.String("address", m.members.Addresses[cc.ReplicaID]))...)
+		} else if cc.Type == pb.UpdateAddress {
+			plog.Infow("applied UPDATE ADDRESS", append(fields,
+				append(target, logger.String("old", oa))...)...)
+		} else if cc.Type == pb.ReplaceWitness {
+			plog.Infow("applied REPLACE WITNESS", append(fields,
+				append(target, logger.Uint64("replaced", cc.ReplacedID))...)...)
+		} else if cc.Type == pb.EnterJoint {
+			plog.Infow("applied ENTER JOINT",
+				append(fields, logger.Any("members", cc.Members))...)
+		} else if cc.Type == pb.LeaveJoint {
+			plog.Infow("applied LEAVE JOINT",
+				append(fields, logger.Any("members", m.members.Addresses))...)
 		} else {
 			plog.Panicf("unknown cc.Type value %d", cc.Type)
 		}
@@ -342,6 +798,36 @@ func (m *membership) handleConfigChange(cc pb.ConfigChange, index uint64) bool {
 		} else if invalidPromotion {
 			plog.Warningf("%s rej invalid nonVoting promotion ccid %d (%d) %s (%s)",
 				m.id(), ccid, index, nid(cc.ReplicaID), cc.Address)
+		} else if invalidWitnessPromotion {
+			plog.Warningf("%s rej promote non-witness ccid %d (%d) %s",
+				m.id(), ccid, index, nid(cc.ReplicaID))
+		} else if invalidAddressUpdate {
+			plog.Warningf("%s rej invalid address update ccid %d (%d) %s (%s)",
+				m.id(), ccid, index, nid(cc.ReplicaID), cc.Address)
+		} else if invalidWitnessReplacement {
+			plog.Warningf("%s rej invalid witness replacement ccid %d (%d) %s, %s (%s)",
+				m.id(), ccid, index, nid(cc.ReplacedID), nid(cc.ReplicaID), cc.Address)
+		} else if addressInUse {
+			plog.Warningf("%s rej address update to address in use ccid %d (%d) %s (%s)",
+				m.id(), ccid, index, nid(cc.ReplicaID), cc.Address)
+		} else if changingJoint {
+			plog.Warningf("%s rej ConfChange in joint config ccid %d (%d), type %s",
+				m.id(), ccid, index, cc.Type)
+		} else if invalidEnterJoint {
+			plog.Warningf("%s rej invalid enter joint ccid %d (%d), %v",
+				m.id(), ccid, index, cc.Members)
+		} else if invalidLeaveJoint {
+			plog.Warningf("%s rej leave joint when not in joint config (%d)",
+				m.id(), index)
+		} else if unsafeChange {
+			plog.Warningf("%s rej unsafe ConfChange ccid %d (%d), type %s, inactive %v",
+				m.id(), ccid, index, cc.Type, cc.Inactive)
+		} else if limitExceeded {
+			plog.Warningf("%s rej ConfChange exceeding limits ccid %d (%d), type %s, %s",
+				m.id(), ccid, index, cc.Type, nid(cc.ReplicaID))
+		} else if tooLarge {
+			plog.Warningf("%s rej ConfChange resulting in a membership too large ccid %d (%d), type %s, %s",
+				m.id(), ccid, index, cc.Type, nid(cc.ReplicaID))
 		} else {
 			plog.Panicf("config change rejected for unknown reasons")
 		}
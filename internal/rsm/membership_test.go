@@ -15,8 +15,14 @@
 package rsm
 
 import (
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/settings"
 	pb "github.com/lni/dragonboat/v4/raftpb"
 )
 
@@ -185,6 +191,15 @@ func TestIsAddingRemovedNode(t *testing.T) {
 	if !o.isAddRemovedNode(cc) {
 		t.Errorf("not rejected")
 	}
+	cc.AllowReuse = true
+	if !o.isAddRemovedNode(cc) {
+		t.Errorf("reuse allowed by config change without protocol version")
+	}
+	cc.ProtocolVersion = pb.ProtocolVersion
+	if o.isAddRemovedNode(cc) {
+		t.Errorf("rejected when reuse is allowed")
+	}
+	cc.AllowReuse = false
 	cc.Type = pb.AddNonVoting
 	cc.ReplicaID = 2
 	if o.isAddRemovedNode(cc) {
@@ -192,6 +207,37 @@ func TestIsAddingRemovedNode(t *testing.T) {
 	}
 }
 
+func TestGetRejectionReason(t *testing.T) {
+	o := newMembership(1, 2, true)
+	o.members.Addresses[1] = "a1"
+	o.members.NonVotings[2] = "a2"
+	o.members.Removed[3] = true
+	tests := []struct {
+		cct       pb.ConfigChangeType
+		replicaID uint64
+		address   string
+		reason    error
+	}{
+		{pb.AddNode, 3, "a3", ErrReplicaIDReused},
+		{pb.AddWitness, 3, "a3", ErrReplicaIDReused},
+		{pb.AddNode, 4, "a1", ErrAddressInUse},
+		{pb.AddNonVoting, 4, "a2", ErrAddressInUse},
+		{pb.AddNode, 2, "a2", nil},
+		{pb.AddNode, 4, "a4", nil},
+		{pb.RemoveNode, 3, "", nil},
+	}
+	for idx, tt := range tests {
+		cc := pb.ConfigChange{
+			Type:      tt.cct,
+			ReplicaID: tt.replicaID,
+			Address:   tt.address,
+		}
+		if reason := o.getRejectionReason(cc); reason != tt.reason {
+			t.Errorf("%d, reason %v, want %v", idx, reason, tt.reason)
+		}
+	}
+}
+
 func TestIsAddingNodeAsNonVoting(t *testing.T) {
 	tests := []struct {
 		t         pb.ConfigChangeType
@@ -504,3 +550,546 @@ func TestApplyRemoveNode(t *testing.T) {
 		t.Errorf("not recorded as removed")
 	}
 }
+
+func TestApplyEnterAndLeaveJoint(t *testing.T) {
+	o := newMembership(1, 2, true)
+	o.members.Addresses[1] = "a1"
+	o.members.Addresses[2] = "a2"
+	o.members.Addresses[3] = "a3"
+	o.members.NonVotings[4] = "a4"
+	cc := pb.ConfigChange{
+		Type:    pb.EnterJoint,
+		Members: map[uint64]string{1: "a1", 4: "a4", 5: "a5"},
+	}
+	if !o.handleConfigChange(cc, 1000) {
+		t.Fatalf("enter joint rejected")
+	}
+	if !o.members.IsJoint() {
+		t.Fatalf("not in joint config")
+	}
+	if len(o.members.Addresses) != 3 || len(o.members.Outgoing) != 3 ||
+		len(o.members.NonVotings) != 0 {
+		t.Errorf("unexpected membership %+v", o.members)
+	}
+	leaving := o.getLeaving()
+	if len(leaving) != 2 || leaving[2] != "a2" || leaving[3] != "a3" {
+		t.Errorf("unexpected leaving nodes %v", leaving)
+	}
+	add := pb.ConfigChange{Type: pb.AddNode, ReplicaID: 6, Address: "a6"}
+	if o.handleConfigChange(add, 1001) {
+		t.Errorf("config change accepted in joint config")
+	}
+	leave := pb.ConfigChange{Type: pb.LeaveJoint, Members: leaving}
+	if !o.handleConfigChange(leave, 1002) {
+		t.Fatalf("leave joint rejected")
+	}
+	if o.members.IsJoint() || len(o.members.Addresses) != 3 {
+		t.Errorf("unexpected membership %+v", o.members)
+	}
+	if !o.members.Removed[2] || !o.members.Removed[3] {
+		t.Errorf("leaving nodes not recorded as removed")
+	}
+	if o.handleConfigChange(leave, 1003) {
+		t.Errorf("leave joint accepted when not in joint config")
+	}
+}
+
+func TestIsInvalidEnterJoint(t *testing.T) {
+	o := newMembership(1, 2, true)
+	o.members.Addresses[1] = "a1"
+	o.members.Addresses[2] = "a2"
+	o.members.Witnesses[3] = "a3"
+	o.members.NonVotings[4] = "a4"
+	o.members.Removed[5] = true
+	tests := []struct {
+		members map[uint64]string
+		invalid bool
+	}{
+		{map[uint64]string{}, true},
+		{map[uint64]string{1: "a1", 2: "a2"}, true},
+		{map[uint64]string{1: "a1", 3: "a3"}, true},
+		{map[uint64]string{1: "a1", 5: "a5"}, true},
+		{map[uint64]string{1: "a2", 6: "a6"}, true},
+		{map[uint64]string{1: "a1", 4: "a5"}, true},
+		{map[uint64]string{1: "a1", 6: "a3"}, true},
+		{map[uint64]string{1: "a1", 6: "a6", 7: "a6"}, true},
+		{map[uint64]string{1: "a1"}, false},
+		{map[uint64]string{1: "a1", 4: "a4"}, false},
+		{map[uint64]string{6: "a6", 7: "a7"}, false},
+	}
+	for idx, tt := range tests {
+		cc := pb.ConfigChange{Type: pb.EnterJoint, Members: tt.members}
+		if o.isInvalidEnterJoint(cc) != tt.invalid {
+			t.Errorf("%d, unexpected result", idx)
+		}
+	}
+}
+
+func TestJointMembershipHashChanges(t *testing.T) {
+	o := newMembership(1, 2, true)
+	o.members.Addresses[1] = "a1"
+	o.members.Addresses[2] = "a2"
+	h := o.getHash()
+	o.members.Outgoing[3] = "a3"
+	if h == o.getHash() {
+		t.Errorf("hash not changed")
+	}
+}
+
+func TestStagedNonVotingCanBePromoted(t *testing.T) {
+	o := newMembership(1, 2, true)
+	o.members.Addresses[1] = "a1"
+	cc := pb.ConfigChange{
+		Type:      pb.AddNonVoting,
+		ReplicaID: 2,
+		Address:   "a2",
+		Staged:    true,
+	}
+	if !o.handleConfigChange(cc, 1000) {
+		t.Fatalf("staged nonVoting rejected")
+	}
+	if !o.members.Staged[2] || o.members.NonVotings[2] != "a2" {
+		t.Fatalf("staged nonVoting not added")
+	}
+	// proposed by the raft leader with no ConfigChangeId
+	promote := pb.ConfigChange{
+		Type:      pb.AddNode,
+		ReplicaID: 2,
+		Address:   "a2",
+		Staged:    true,
+	}
+	unstaged := pb.ConfigChange{Type: pb.AddNode, ReplicaID: 3, Staged: true}
+	if o.isUpToDate(unstaged) {
+		t.Errorf("unexpected up to date config change")
+	}
+	if !o.handleConfigChange(promote, 1001) {
+		t.Fatalf("promotion rejected")
+	}
+	if len(o.members.Staged) != 0 || o.members.Addresses[2] != "a2" ||
+		len(o.members.NonVotings) != 0 {
+		t.Errorf("unexpected membership %+v", o.members)
+	}
+	if o.handleConfigChange(promote, 1002) {
+		t.Errorf("promotion accepted twice")
+	}
+}
+
+func TestWitnessCanBePromoted(t *testing.T) {
+	o := newMembership(1, 2, false)
+	o.members.Addresses[1] = "a1"
+	o.members.Witnesses[2] = "a2"
+	cc := pb.ConfigChange{Type: pb.PromoteWitness, ReplicaID: 1}
+	if o.handleConfigChange(cc, 1000) {
+		t.Fatalf("regular node promoted")
+	}
+	cc.ReplicaID = 2
+	if !o.handleConfigChange(cc, 1001) {
+		t.Fatalf("witness promotion rejected")
+	}
+	if o.members.Addresses[2] != "a2" || len(o.members.Witnesses) != 0 {
+		t.Errorf("unexpected membership %+v", o.members)
+	}
+	if o.members.ConfigChangeId != 1001 {
+		t.Errorf("unexpected ccid %d", o.members.ConfigChangeId)
+	}
+	if o.handleConfigChange(cc, 1002) {
+		t.Errorf("witness promoted twice")
+	}
+}
+
+func TestWitnessCanBeReplaced(t *testing.T) {
+	o := newMembership(1, 2, false)
+	o.members.Addresses[1] = "a1"
+	o.members.Witnesses[2] = "a2"
+	tests := []struct {
+		replaced  uint64
+		replicaID uint64
+		address   string
+		accepted  bool
+	}{
+		{1, 3, "a3", false},
+		{2, 2, "a3", false},
+		{2, 1, "a3", false},
+		{2, 3, "", false},
+		{2, 3, "a1", false},
+		{4, 3, "a3", false},
+		{2, 3, "a2", true},
+		{2, 4, "a4", false},
+		{3, 2, "a2", false},
+	}
+	for idx, tt := range tests {
+		cc := pb.ConfigChange{
+			Type:       pb.ReplaceWitness,
+			ReplicaID:  tt.replicaID,
+			ReplacedID: tt.replaced,
+			Address:    tt.address,
+		}
+		if accepted := o.handleConfigChange(cc,
+			uint64(1000+idx)); accepted != tt.accepted {
+			t.Errorf("%d, accepted %t, want %t", idx, accepted, tt.accepted)
+		}
+	}
+	if len(o.members.Witnesses) != 1 || o.members.Witnesses[3] != "a2" {
+		t.Errorf("unexpected witnesses %v", o.members.Witnesses)
+	}
+	if !o.members.Removed[2] {
+		t.Errorf("replaced witness not removed")
+	}
+}
+
+func TestReplicaAddressCanBeUpdated(t *testing.T) {
+	o := newMembership(1, 2, false)
+	o.members.Addresses[1] = "a1"
+	o.members.Addresses[2] = "a2"
+	o.members.NonVotings[3] = "a3"
+	tests := []struct {
+		replicaID uint64
+		address   string
+		accepted  bool
+		inUse     bool
+	}{
+		{4, "a4", false, false},
+		{2, "a2", false, false},
+		{2, "", false, false},
+		{2, "a1", false, true},
+		{2, "a5", true, false},
+		{2, "a2", false, false},
+		{3, "a2", true, false},
+		{2, "a6", true, false},
+		{2, "a5", false, false},
+	}
+	for idx, tt := range tests {
+		cc := pb.ConfigChange{
+			Type:      pb.UpdateAddress,
+			ReplicaID: tt.replicaID,
+			Address:   tt.address,
+		}
+		if o.handleConfigChange(cc, uint64(1000+idx)) != tt.accepted {
+			t.Fatalf("%d, unexpected result", idx)
+		}
+		if tt.inUse != errors.Is(o.getRejectionReason(cc), ErrAddressInUse) {
+			t.Errorf("%d, unexpected rejection reason", idx)
+		}
+	}
+	if o.members.Addresses[2] != "a6" || o.members.NonVotings[3] != "a2" ||
+		len(o.members.Addresses) != 2 || len(o.members.NonVotings) != 1 {
+		t.Errorf("unexpected membership %+v", o.members)
+	}
+	retired := map[string]uint64{"a2": 2, "a3": 3, "a5": 2}
+	if !reflect.DeepEqual(o.members.Retired, retired) {
+		t.Errorf("unexpected retired addresses %v", o.members.Retired)
+	}
+	if !reflect.DeepEqual(o.get().Retired, retired) {
+		t.Errorf("retired addresses not copied")
+	}
+}
+
+func TestUnsafeConfigChangeIsRejected(t *testing.T) {
+	o := newMembership(1, 2, false)
+	o.members.Addresses[1] = "a1"
+	o.members.Addresses[2] = "a2"
+	o.members.Addresses[3] = "a3"
+	cc := pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 2,
+		Inactive: []uint64{3}, ProtocolVersion: pb.ProtocolVersion}
+	if o.handleConfigChange(cc, 1000) {
+		t.Fatalf("unsafe config change accepted")
+	}
+	if len(o.members.Addresses) != 3 || len(o.members.Removed) != 0 {
+		t.Errorf("unexpected membership %+v", o.members)
+	}
+	cc.Inactive = nil
+	if !o.handleConfigChange(cc, 1001) {
+		t.Fatalf("config change rejected")
+	}
+}
+
+func TestConfigChangeHistoryIsBounded(t *testing.T) {
+	o := newMembership(1, 2, false)
+	o.historySize = 3
+	hash := o.getHash()
+	for i := uint64(1); i <= 5; i++ {
+		cc := pb.ConfigChange{Type: pb.AddNonVoting, ReplicaID: i + 10}
+		o.record(cc, i*100, i)
+	}
+	if o.getHash() != hash {
+		t.Errorf("hash changed by history")
+	}
+	history := o.get().History
+	if len(history) != 3 {
+		t.Fatalf("unexpected history size %d", len(history))
+	}
+	for idx, r := range history {
+		i := uint64(idx) + 3
+		if r.Index != i*100 || r.Term != i || r.ReplicaID != i+10 ||
+			r.Type != pb.AddNonVoting || r.Timestamp == 0 {
+			t.Errorf("unexpected record %+v", r)
+		}
+	}
+}
+
+func TestConfigChangeExceedingLimitsIsRejected(t *testing.T) {
+	o := newMembership(1, 2, false)
+	o.members.Addresses[1] = "a1"
+	cc := pb.ConfigChange{Type: pb.AddWitness, ReplicaID: 2,
+		Address: "a2", LimitExceeded: true, ProtocolVersion: pb.ProtocolVersion}
+	if o.handleConfigChange(cc, 1000) {
+		t.Fatalf("config change exceeding limits accepted")
+	}
+	if len(o.members.Witnesses) != 0 {
+		t.Errorf("unexpected membership %+v", o.members)
+	}
+	cc.LimitExceeded = false
+	if !o.handleConfigChange(cc, 1001) {
+		t.Fatalf("config change rejected")
+	}
+}
+
+// getMaxSizeMembership returns a membership with the max number of members,
+// the max number of removed replica IDs and the longest addresses.
+func getMaxSizeMembership() pb.Membership {
+	m := newMembership(1, 1, false)
+	addr := func(nid uint64) string {
+		prefix := fmt.Sprintf("%d:", nid)
+		return prefix + strings.Repeat("a",
+			int(settings.MaxAddressLength)-len(prefix))
+	}
+	for nid := uint64(1); nid <= settings.MaxMembers; nid++ {
+		switch nid % 4 {
+		case 0:
+			m.members.NonVotings[nid] = addr(nid)
+		case 1:
+			m.members.Witnesses[nid] = addr(nid)
+		default:
+			m.members.Addresses[nid] = addr(nid)
+		}
+	}
+	for i := uint64(1); i <= settings.MaxRemovedReplicas; i++ {
+		m.members.Removed[settings.MaxMembers+i] = true
+	}
+	for i := uint64(1); i <= defaultConfigChangeHistorySize; i++ {
+		m.record(pb.ConfigChange{Type: pb.UpdateAddress,
+			ReplicaID: i, Address: addr(i)}, i*10, i)
+		m.members.Retired[addr(i+settings.MaxMembers)] = i
+	}
+	m.members.ConfigChangeId = 1000
+	m.members.PrunedRemovedCount = 100
+	m.members.PrunedRemovedHash = 12345
+	m.members.PrunedRemovedMax = settings.MaxMembers
+	return m.get()
+}
+
+func TestRemovedReplicasArePruned(t *testing.T) {
+	apply := func(ids []uint64) membership {
+		o := newMembership(1, 2, false)
+		o.members.Addresses[1] = "a1"
+		o.members.Addresses[2] = "a2"
+		for _, nid := range ids {
+			o.members.Removed[nid] = true
+		}
+		cc := pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 1,
+			MaxRemoved: 10, ProtocolVersion: pb.ProtocolVersion}
+		if !o.handleConfigChange(cc, 1000) {
+			t.Fatalf("config change rejected")
+		}
+		return o
+	}
+	ids := make([]uint64, 0)
+	for nid := uint64(100); nid < 120; nid++ {
+		ids = append(ids, nid)
+	}
+	o := apply(ids)
+	if len(o.members.Removed) != 10 {
+		t.Fatalf("unexpected removed count %d", len(o.members.Removed))
+	}
+	// the smallest removed replica IDs are pruned
+	hash := mixReplicaID(1)
+	for nid := uint64(100); nid < 110; nid++ {
+		hash += mixReplicaID(nid)
+	}
+	m := o.get()
+	if m.PrunedRemovedCount != 11 || m.PrunedRemovedMax != 109 ||
+		m.PrunedRemovedHash != hash {
+		t.Errorf("unexpected pruned summary %+v", m)
+	}
+	for nid := uint64(110); nid < 120; nid++ {
+		if !m.Removed[nid] {
+			t.Errorf("%d not kept", nid)
+		}
+	}
+	// the result doesn't depend on the order of removed replica IDs
+	reversed := make([]uint64, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		reversed = append(reversed, ids[i])
+	}
+	if o2 := apply(reversed); !reflect.DeepEqual(o2.get(), m) {
+		t.Errorf("pruning is not deterministic")
+	}
+	// pruned replica IDs are still considered as removed
+	cc := pb.ConfigChange{Type: pb.AddNode, ReplicaID: 105, Address: "a105"}
+	if !errors.Is(o.getRejectionReason(cc), ErrReplicaIDReused) {
+		t.Errorf("pruned replica ID not considered as removed")
+	}
+	if o.handleConfigChange(cc, 1001) {
+		t.Fatalf("adding pruned replica ID accepted")
+	}
+	cc.AllowReuse = true
+	cc.ProtocolVersion = pb.ProtocolVersion
+	if !o.handleConfigChange(cc, 1002) {
+		t.Fatalf("config change rejected")
+	}
+	if o.members.IsRemoved(105) || o.members.IsRemoved(200) {
+		t.Errorf("unexpected removed replica")
+	}
+	// the limit is only applied when specified by the config change
+	cc = pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 105}
+	if !o.handleConfigChange(cc, 1003) {
+		t.Fatalf("config change rejected")
+	}
+	if len(o.members.Removed) != 11 || !o.members.IsRemoved(105) {
+		t.Errorf("unexpected removed replicas %v", o.members.Removed)
+	}
+}
+
+func TestUnboundedRemovedReplicasAreConvertedOnNextConfigChange(t *testing.T) {
+	old := pb.Membership{
+		ConfigChangeId: 100,
+		Addresses:      map[uint64]string{1: "a1", 2: "a2", 3: "a3"},
+		Removed:        make(map[uint64]bool),
+	}
+	for nid := uint64(10); nid < 910; nid++ {
+		old.Removed[nid] = true
+	}
+	// records written before the pruned summary was introduced
+	var m pb.Membership
+	if err := m.Unmarshal(pb.MustMarshal(&old)); err != nil {
+		t.Fatalf("failed to unmarshal %v", err)
+	}
+	o := newMembership(1, 2, false)
+	o.set(m)
+	if len(o.members.Removed) != 900 || o.members.PrunedRemovedCount != 0 {
+		t.Fatalf("unexpected membership %+v", o.members)
+	}
+	cc := pb.ConfigChange{Type: pb.AddNonVoting, ReplicaID: 1000,
+		Address: "a1000"}
+	if !o.handleConfigChange(cc, 200) {
+		t.Fatalf("config change rejected")
+	}
+	if len(o.members.Removed) != 900 {
+		t.Errorf("removed replicas pruned without limit")
+	}
+	cc = pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 1000,
+		MaxRemoved: 256, ProtocolVersion: pb.ProtocolVersion}
+	if !o.handleConfigChange(cc, 201) {
+		t.Fatalf("config change rejected")
+	}
+	converted := o.get()
+	if len(converted.Removed) != 256 ||
+		converted.PrunedRemovedCount != 645 ||
+		converted.PrunedRemovedMax != 654 {
+		t.Errorf("unexpected converted membership, removed %d, %d, %d",
+			len(converted.Removed), converted.PrunedRemovedCount,
+			converted.PrunedRemovedMax)
+	}
+	for nid := uint64(10); nid < 910; nid++ {
+		if !converted.IsRemoved(nid) {
+			t.Errorf("%d not removed", nid)
+		}
+	}
+	if !converted.IsRemoved(1000) {
+		t.Errorf("1000 not removed")
+	}
+	if converted.IsRemoved(1) {
+		t.Errorf("member considered as removed")
+	}
+	if sz := converted.Size(); sz >= old.Size()/2 {
+		t.Errorf("converted size %d, original size %d", sz, old.Size())
+	}
+}
+
+func TestConfigChangeResultingInTooLargeMembershipIsRejected(t *testing.T) {
+	o := newMembership(1, 2, false)
+	o.set(getMaxSizeMembership())
+	long := strings.Repeat("a", int(settings.MaxAddressLength)+1)
+	tests := []struct {
+		cc       pb.ConfigChange
+		tooLarge bool
+	}{
+		{pb.ConfigChange{Type: pb.AddNode, ReplicaID: 10000, Address: "a"}, true},
+		{pb.ConfigChange{Type: pb.AddNonVoting, ReplicaID: 10000, Address: "a"}, true},
+		{pb.ConfigChange{Type: pb.AddWitness, ReplicaID: 10000, Address: "a"}, true},
+		{pb.ConfigChange{Type: pb.AddNode, ReplicaID: 4,
+			Address: o.members.NonVotings[4]}, false},
+		{pb.ConfigChange{Type: pb.UpdateAddress, ReplicaID: 2, Address: long}, true},
+		{pb.ConfigChange{Type: pb.UpdateAddress, ReplicaID: 2, Address: "a"}, false},
+		{pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 2}, false},
+		{pb.ConfigChange{Type: pb.EnterJoint,
+			Members: map[uint64]string{10000: "a"}}, true},
+		{pb.ConfigChange{Type: pb.AddNode, ReplicaID: 10000, Address: "a",
+			Initialize: true}, false},
+	}
+	for idx, tt := range tests {
+		if v := ExceedsMembershipLimits(o.members, tt.cc); v != tt.tooLarge {
+			t.Errorf("%d, got %t, want %t", idx, v, tt.tooLarge)
+		}
+	}
+	tests[0].cc.ProtocolVersion = pb.ProtocolVersion
+	if err := o.getRejectionReason(tests[0].cc); !errors.Is(err, ErrMembershipTooLarge) {
+		t.Errorf("unexpected rejection reason %v", err)
+	}
+	if o.handleConfigChange(tests[0].cc, 2000) {
+		t.Fatalf("config change accepted")
+	}
+	if !o.handleConfigChange(tests[6].cc, 2001) {
+		t.Fatalf("config change rejected")
+	}
+	if !o.handleConfigChange(tests[0].cc, 2002) {
+		t.Fatalf("config change rejected")
+	}
+	small := newMembership(1, 2, false)
+	small.members.Addresses[1] = "a1"
+	cc := pb.ConfigChange{Type: pb.AddNode, ReplicaID: 2, Address: long,
+		ProtocolVersion: pb.ProtocolVersion}
+	if small.handleConfigChange(cc, 100) {
+		t.Fatalf("overlong address accepted")
+	}
+	cc = pb.ConfigChange{Type: pb.EnterJoint,
+		Members: map[uint64]string{1: "a1", 2: long}}
+	if !ExceedsMembershipLimits(small.members, cc) {
+		t.Errorf("overlong address accepted")
+	}
+}
+
+func TestNewRulesAreNotAppliedToConfigChangesWithoutProtocolVersion(t *testing.T) {
+	// such config changes are also applied by replicas predating the rules
+	o := newMembership(1, 2, false)
+	o.members.Addresses[1] = "a1"
+	o.members.Addresses[2] = "a2"
+	o.members.Addresses[3] = "a3"
+	for nid := uint64(10); nid < 20; nid++ {
+		o.members.Removed[nid] = true
+	}
+	cc := pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: 3,
+		Inactive: []uint64{2}, LimitExceeded: true, MaxRemoved: 5}
+	if err := o.getRejectionReason(cc); err != nil {
+		t.Errorf("unexpected rejection reason %v", err)
+	}
+	if !o.handleConfigChange(cc, 1000) {
+		t.Fatalf("config change rejected")
+	}
+	if len(o.members.Removed) != 11 || o.members.PrunedRemovedCount != 0 {
+		t.Errorf("removed replicas pruned, %+v", o.members)
+	}
+	cc = pb.ConfigChange{Type: pb.AddNode, ReplicaID: 10,
+		Address: "a10", AllowReuse: true}
+	if !errors.Is(o.getRejectionReason(cc), ErrReplicaIDReused) {
+		t.Errorf("reuse allowed")
+	}
+	if o.handleConfigChange(cc, 1001) {
+		t.Fatalf("config change accepted")
+	}
+	long := strings.Repeat("a", int(settings.MaxAddressLength)+1)
+	cc = pb.ConfigChange{Type: pb.AddNode, ReplicaID: 4, Address: long}
+	if !o.handleConfigChange(cc, 1002) {
+		t.Fatalf("config change rejected")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"math/bits"
+	"sync"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+const (
+	// minEntrySliceCap is the capacity of the smallest pooled entry slices.
+	minEntrySliceCap = 16
+	// entrySlicePools is the number of entry slice pools, pool i holds slices
+	// with a capacity of minEntrySliceCap << i.
+	entrySlicePools = 12
+	// maxPayloadBufferSize is the max size of the buffer retained by the
+	// payloadBuffer.
+	maxPayloadBufferSize = 4 * 1024 * 1024
+)
+
+// entrySlicePool contains pools of entry slices keyed by their capacity, they
+// are used for applying batched entries and collecting their results.
+var entrySlicePool [entrySlicePools]sync.Pool
+
+func getEntrySlicePoolIndex(sz int) int {
+	if sz <= minEntrySliceCap {
+		return 0
+	}
+	return bits.Len(uint(sz-1)) - bits.Len(uint(minEntrySliceCap-1))
+}
+
+// getEntrySlice returns an empty entry slice with a capacity of at least sz.
+func getEntrySlice(sz int) *[]sm.Entry {
+	idx := getEntrySlicePoolIndex(sz)
+	if idx >= entrySlicePools {
+		ents := make([]sm.Entry, 0, sz)
+		return &ents
+	}
+	if v := entrySlicePool[idx].Get(); v != nil {
+		return v.(*[]sm.Entry)
+	}
+	ents := make([]sm.Entry, 0, minEntrySliceCap<<idx)
+	return &ents
+}
+
+// putEntrySlice returns the entry slice obtained from getEntrySlice to its
+// pool. Pooled slices never reference the Cmd or RequestID of any entry.
+func putEntrySlice(ents *[]sm.Entry) {
+	idx := getEntrySlicePoolIndex(cap(*ents))
+	if idx >= entrySlicePools {
+		return
+	}
+	v := *ents
+	for i := range v {
+		v[i] = sm.Entry{}
+	}
+	*ents = v[:0]
+	entrySlicePool[idx].Put(ents)
+}
+
+// payloadBuffer is used for decoding the payloads of compressed entries into
+// a reused buffer rather than allocating a new byte slice for each of them.
+// Payloads returned by getPayload are valid until the next reset, it is only
+// used for user state machines that implement sm.INonRetainingStateMachine.
+type payloadBuffer struct {
+	buf  []byte
+	size uint64
+}
+
+// reset makes the buffer ready for decoding a new batch of entries. The
+// buffer grows when the previous batch didn't fit in it.
+func (p *payloadBuffer) reset() {
+	if p.size > uint64(cap(p.buf)) && p.size <= maxPayloadBufferSize {
+		p.buf = make([]byte, 0, p.size)
+	}
+	p.buf = p.buf[:0]
+	p.size = 0
+}
+
+// getPayload returns the payload of the entry ready to be applied into the
+// state machine.
+func (p *payloadBuffer) getPayload(e pb.Entry) ([]byte, error) {
+	if e.Type != pb.EncodedEntry {
+		return GetPayload(e)
+	}
+	if _, ct, _ := parseEncodedHeader(e.Cmd); ct != EESnappy {
+		return GetPayload(e)
+	}
+	sz, _ := getV0PayloadUncompressedSize(e.Cmd)
+	p.size += sz
+	if p.size > uint64(cap(p.buf)) {
+		return getDecodedPayload(e.Cmd, nil)
+	}
+	start := len(p.buf)
+	p.buf = p.buf[:start+int(sz)]
+	return getDecodedPayload(e.Cmd, p.buf[start:])
+}
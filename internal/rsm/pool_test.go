@@ -0,0 +1,125 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/lni/dragonboat/v4/internal/utils/dio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func TestGetEntrySlicePoolIndex(t *testing.T) {
+	tests := []struct {
+		sz  int
+		idx int
+	}{
+		{0, 0},
+		{1, 0},
+		{16, 0},
+		{17, 1},
+		{32, 1},
+		{33, 2},
+		{1024, 6},
+		{1025, 7},
+	}
+	for idx, tt := range tests {
+		if v := getEntrySlicePoolIndex(tt.sz); v != tt.idx {
+			t.Errorf("%d, got %d, want %d", idx, v, tt.idx)
+		}
+	}
+}
+
+func TestEntrySliceHasRequiredCapacity(t *testing.T) {
+	for _, sz := range []int{0, 1, 16, 17, 100, 1025,
+		minEntrySliceCap << entrySlicePools} {
+		ents := getEntrySlice(sz)
+		if len(*ents) != 0 || cap(*ents) < sz {
+			t.Errorf("sz %d, unexpected len %d, cap %d", sz, len(*ents), cap(*ents))
+		}
+		putEntrySlice(ents)
+	}
+}
+
+func TestPooledEntrySliceIsCleared(t *testing.T) {
+	ents := getEntrySlice(8)
+	v := append(*ents, sm.Entry{Index: 1, Cmd: []byte("test")})
+	*ents = v
+	putEntrySlice(ents)
+	if len(*ents) != 0 {
+		t.Errorf("pooled slice not reset")
+	}
+	if v[0].Index != 0 || v[0].Cmd != nil {
+		t.Errorf("pooled entry not cleared")
+	}
+}
+
+func getTestSnappyEntry(index uint64, data []byte) pb.Entry {
+	return pb.Entry{
+		Type:  pb.EncodedEntry,
+		Index: index,
+		Cmd:   GetEncoded(dio.Snappy, data, nil),
+	}
+}
+
+func TestPayloadBufferGrowsWhenRequired(t *testing.T) {
+	data1 := bytes.Repeat([]byte("test-data-1"), 100)
+	data2 := bytes.Repeat([]byte("test-data-2"), 100)
+	p := &payloadBuffer{}
+	for i := 0; i < 2; i++ {
+		p.reset()
+		v1, err := p.getPayload(getTestSnappyEntry(1, data1))
+		if err != nil {
+			t.Fatalf("failed to get payload %v", err)
+		}
+		v2, err := p.getPayload(getTestSnappyEntry(2, data2))
+		if err != nil {
+			t.Fatalf("failed to get payload %v", err)
+		}
+		if !bytes.Equal(v1, data1) || !bytes.Equal(v2, data2) {
+			t.Fatalf("unexpected payload")
+		}
+	}
+	if cap(p.buf) != len(data1)+len(data2) || len(p.buf) != cap(p.buf) {
+		t.Errorf("unexpected buffer len %d, cap %d", len(p.buf), cap(p.buf))
+	}
+}
+
+func TestPayloadBufferIgnoresUncompressedEntries(t *testing.T) {
+	data := []byte("test-data")
+	p := &payloadBuffer{}
+	p.reset()
+	e := pb.Entry{Type: pb.ApplicationEntry, Cmd: data}
+	v, err := p.getPayload(e)
+	if err != nil {
+		t.Fatalf("failed to get payload %v", err)
+	}
+	if &v[0] != &data[0] {
+		t.Errorf("payload copied")
+	}
+	e = pb.Entry{
+		Type: pb.EncodedEntry,
+		Cmd:  GetEncoded(dio.NoCompression, data, nil),
+	}
+	v, err = p.getPayload(e)
+	if err != nil {
+		t.Fatalf("failed to get payload %v", err)
+	}
+	if !bytes.Equal(v, data) || p.size != 0 {
+		t.Errorf("unexpected payload %s, size %d", v, p.size)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"sort"
+
+	"github.com/cockroachdb/errors"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// ErrInvalidRecoveryMembers indicates that the specified members can not be
+// used as the recovered membership.
+var ErrInvalidRecoveryMembers = errors.New("invalid recovery members")
+
+// ReplayMembership returns the membership of the replica after applying the
+// config change entries found in entries to the specified membership, other
+// entries are ignored. Config change IDs are not checked, the membership is
+// the same as the one maintained by replicas with OrderedConfigChange
+// disabled.
+func ReplayMembership(shardID uint64, replicaID uint64,
+	m pb.Membership, entries []pb.Entry) pb.Membership {
+	members := newMembership(shardID, replicaID, false)
+	members.set(m)
+	for _, e := range entries {
+		if !e.IsConfigChange() {
+			continue
+		}
+		var cc pb.ConfigChange
+		pb.MustUnmarshal(&cc, e.Cmd)
+		members.handleRecoveryConfigChange(cc, e.Index)
+	}
+	return members.get()
+}
+
+// GetRecoveryConfigChanges returns the config changes that rewrite the
+// specified membership so the specified members become its only members, all
+// of them are regular nodes. Members of m not included in members are removed
+// and new members are added. The returned config changes are marked as
+// Initialize so they are accepted regardless of the OrderedConfigChange
+// setting, ErrInvalidRecoveryMembers is returned when any of them would be
+// rejected when applied in order.
+func GetRecoveryConfigChanges(shardID uint64, replicaID uint64,
+	m pb.Membership, members map[uint64]string) ([]pb.ConfigChange, error) {
+	var ccs []pb.ConfigChange
+	if m.IsJoint() {
+		ccs = append(ccs, pb.ConfigChange{Type: pb.LeaveJoint})
+	}
+	var removed []uint64
+	for _, current := range []map[uint64]string{m.Addresses,
+		m.NonVotings, m.Witnesses} {
+		for nid := range current {
+			if _, ok := members[nid]; !ok {
+				removed = append(removed, nid)
+			}
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+	for _, nid := range removed {
+		ccs = append(ccs, pb.ConfigChange{Type: pb.RemoveNode, ReplicaID: nid})
+	}
+	added := make([]uint64, 0, len(members))
+	for nid := range members {
+		if _, ok := m.Addresses[nid]; !ok {
+			added = append(added, nid)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+	for _, nid := range added {
+		ccs = append(ccs, pb.ConfigChange{
+			Type:      pb.AddNode,
+			ReplicaID: nid,
+			Address:   members[nid],
+		})
+	}
+	if len(ccs) == 0 {
+		return nil, errors.Wrap(ErrInvalidRecoveryMembers, "membership unchanged")
+	}
+	check := newMembership(shardID, replicaID, true)
+	check.set(m)
+	for i := range ccs {
+		ccs[i].Initialize = true
+		if !check.handleRecoveryConfigChange(ccs[i], 0) {
+			return nil, errors.Wrapf(ErrInvalidRecoveryMembers,
+				"config change %s %d rejected", ccs[i].Type, ccs[i].ReplicaID)
+		}
+	}
+	for nid, addr := range members {
+		if oa, ok := check.members.Addresses[nid]; !ok || !addressEqual(oa, addr) {
+			return nil, errors.Wrapf(ErrInvalidRecoveryMembers,
+				"replica %d address changed", nid)
+		}
+	}
+	return ccs, nil
+}
+
+// handleRecoveryConfigChange applies the config change in the same way as the
+// StateMachine.
+func (m *membership) handleRecoveryConfigChange(cc pb.ConfigChange,
+	index uint64) bool {
+	if cc.Type == pb.LeaveJoint {
+		cc.Members = m.getLeaving()
+	}
+	return m.handleConfigChange(cc, index)
+}
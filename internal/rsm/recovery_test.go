@@ -0,0 +1,101 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func getRecoveryTestMembership() pb.Membership {
+	return pb.Membership{
+		ConfigChangeId: 10,
+		Addresses:      map[uint64]string{1: "a1", 2: "a2", 3: "a3"},
+		NonVotings:     map[uint64]string{4: "a4"},
+		Witnesses:      map[uint64]string{5: "a5"},
+		Removed:        map[uint64]bool{6: true},
+	}
+}
+
+func TestReplayMembership(t *testing.T) {
+	cc1 := pb.ConfigChange{ConfigChangeId: 100, Type: pb.RemoveNode, ReplicaID: 3}
+	cc2 := pb.ConfigChange{Type: pb.AddNode, ReplicaID: 7, Address: "a7"}
+	entries := []pb.Entry{
+		{Index: 11, Type: pb.ApplicationEntry, Cmd: []byte("test")},
+		{Index: 12, Type: pb.ConfigChangeEntry, Cmd: pb.MustMarshal(&cc1)},
+		{Index: 13, Type: pb.ConfigChangeEntry, Cmd: pb.MustMarshal(&cc2)},
+	}
+	m := ReplayMembership(1, 1, getRecoveryTestMembership(), entries)
+	if len(m.Addresses) != 3 || m.Addresses[7] != "a7" || !m.Removed[3] {
+		t.Errorf("unexpected membership %+v", m)
+	}
+	if m.ConfigChangeId != 13 {
+		t.Errorf("unexpected config change id %d", m.ConfigChangeId)
+	}
+}
+
+func TestGetRecoveryConfigChanges(t *testing.T) {
+	ccs, err := GetRecoveryConfigChanges(1, 1,
+		getRecoveryTestMembership(), map[uint64]string{1: "a1", 7: "a7"})
+	if err != nil {
+		t.Fatalf("failed to get config changes %v", err)
+	}
+	expected := []pb.ConfigChange{
+		{Type: pb.RemoveNode, ReplicaID: 2, Initialize: true},
+		{Type: pb.RemoveNode, ReplicaID: 3, Initialize: true},
+		{Type: pb.RemoveNode, ReplicaID: 4, Initialize: true},
+		{Type: pb.RemoveNode, ReplicaID: 5, Initialize: true},
+		{Type: pb.AddNode, ReplicaID: 7, Address: "a7", Initialize: true},
+	}
+	if len(ccs) != len(expected) {
+		t.Fatalf("unexpected config changes %+v", ccs)
+	}
+	for idx, cc := range ccs {
+		if cc.Type != expected[idx].Type ||
+			cc.ReplicaID != expected[idx].ReplicaID ||
+			cc.Address != expected[idx].Address ||
+			cc.Initialize != expected[idx].Initialize {
+			t.Errorf("%d, got %+v, want %+v", idx, cc, expected[idx])
+		}
+	}
+}
+
+func TestInvalidRecoveryMembersAreRejected(t *testing.T) {
+	tests := []map[uint64]string{
+		// witness can not be promoted
+		{1: "a1", 5: "a5"},
+		// removed replica can not be added back
+		{1: "a1", 6: "a6"},
+		// address of existing replica can not be changed
+		{1: "changed"},
+		// non-voting replica can not be promoted with a different address
+		{1: "a1", 4: "changed"},
+	}
+	for idx, members := range tests {
+		_, err := GetRecoveryConfigChanges(1, 1,
+			getRecoveryTestMembership(), members)
+		if !errors.Is(err, ErrInvalidRecoveryMembers) {
+			t.Errorf("%d, unexpected error %v", idx, err)
+		}
+	}
+	m := pb.Membership{Addresses: map[uint64]string{1: "a1", 2: "a2"}}
+	_, err := GetRecoveryConfigChanges(1, 1, m, map[uint64]string{1: "a1", 2: "a2"})
+	if !errors.Is(err, ErrInvalidRecoveryMembers) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -378,10 +378,10 @@ func (br *v2reader) Sum() []byte {
 
 func getHeaderFromFirstChunk(data []byte) ([]byte, []byte, bool) {
 	if uint64(len(data)) < HeaderSize {
-		panic("first chunk is too small")
+		return nil, nil, false
 	}
 	sz := binary.LittleEndian.Uint64(data)
-	if sz > HeaderSize-8 {
+	if sz > HeaderSize-12 {
 		return nil, nil, false
 	}
 	return data[8 : 8+sz], data[8+sz : 12+sz], true
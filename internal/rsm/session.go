@@ -50,6 +50,9 @@ type Session struct {
 	History       map[RaftSeriesID]sm.Result
 	ClientID      RaftClientID
 	RespondedUpTo RaftSeriesID
+	// LastActive is the index of the Raft log entry of the last activity of the
+	// session. It is only maintained when the session TTL is enabled.
+	LastActive uint64 `json:",omitempty"`
 }
 
 // v1session is the session type used in v1 snapshot format.
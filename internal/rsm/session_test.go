@@ -48,7 +48,7 @@ func TestResponseCanBeAdded(t *testing.T) {
 		}
 		v, ok := s.getResponse(tt.testSeriesNum)
 		if v.Value != tt.expectedValue {
-			t.Errorf("i %d, v %d, want %d", i, v, tt.expectedValue)
+			t.Errorf("i %d, v %d, want %d", i, v.Value, tt.expectedValue)
 		}
 		if ok != tt.expectedResult {
 			t.Errorf("i %d, v %t, want %t", i, ok, tt.expectedResult)
@@ -151,6 +151,35 @@ func TestSessionCanBeSavedAndRestored(t *testing.T) {
 	}
 }
 
+func TestApplicationErrorCanBeSavedAndRestored(t *testing.T) {
+	s := newSession(123)
+	s.addResponse(1, sm.Result{Value: 1})
+	plain := &bytes.Buffer{}
+	if err := s.save(plain); err != nil {
+		t.Fatalf("save failed %v", err)
+	}
+	// results without application error are saved in the same format
+	if bytes.Contains(plain.Bytes(), []byte("Error")) {
+		t.Errorf("unexpected error field in %s", plain.Bytes())
+	}
+	s.addResponse(2, sm.Result{Value: 2,
+		Error: &sm.ApplicationError{Code: 3, Message: "conflict"}})
+	snapshot := &bytes.Buffer{}
+	if err := s.save(snapshot); err != nil {
+		t.Fatalf("save failed %v", err)
+	}
+	newS := &Session{}
+	if err := newS.recoverFromSnapshot(snapshot, V2); err != nil {
+		t.Fatalf("failed to create session from snapshot, %v", err)
+	}
+	if !reflect.DeepEqual(newS, s) {
+		t.Errorf("got %v, want %v", newS, s)
+	}
+	if r, ok := newS.getResponse(2); !ok || r.Error == nil || r.Error.Code != 3 {
+		t.Errorf("application error not restored, %+v", r)
+	}
+}
+
 func TestSessionCanBeRestoredFromV1Snapshot(t *testing.T) {
 	session := &v1session{
 		ClientID:      123,
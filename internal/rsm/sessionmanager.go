@@ -15,23 +15,75 @@
 package rsm
 
 import (
+	"bytes"
 	"io"
 
+	"github.com/lni/dragonboat/v4/internal/invariants"
+	pb "github.com/lni/dragonboat/v4/raftpb"
 	sm "github.com/lni/dragonboat/v4/statemachine"
 )
 
+// proposalStatus is the outcome of checking a session managed proposal against
+// its client session.
+type proposalStatus int
+
+const (
+	// proposalUpdate indicates that the proposal is to be applied with its
+	// result added to the client session.
+	proposalUpdate proposalStatus = iota
+	// proposalRejected indicates that the client session is not registered,
+	// the client is expected to crash.
+	proposalRejected
+	// proposalIgnored indicates that the client already confirmed the response
+	// of the proposal, the client is expected to timeout.
+	proposalIgnored
+	// proposalResponded indicates that the proposal has been applied but the
+	// client never confirmed the response, the recorded result is returned
+	// again without updating the state machine.
+	proposalResponded
+)
+
+// sessionCapacityData is the data of the result of client registrations
+// rejected as there are already LRUMaxSessionCount active client sessions.
+var sessionCapacityData = []byte("session capacity exceeded")
+
+// SessionCapacityResult returns the result of client registrations rejected
+// as there are already too many client sessions active within the session
+// TTL.
+func SessionCapacityResult() sm.Result {
+	return sm.Result{Data: sessionCapacityData}
+}
+
+// IsSessionCapacityResult returns a boolean value indicating whether the
+// result is the one of a client registration rejected as there are already
+// too many client sessions active within the session TTL.
+func IsSessionCapacityResult(result sm.Result) bool {
+	return result.Value == 0 && bytes.Equal(result.Data, sessionCapacityData)
+}
+
 // SessionManager is the wrapper struct that implements client session related
 // functionalities used in the IManagedStateMachine interface.
 type SessionManager struct {
 	lru *lrusession
+	// chunks contains chunked proposals being reassembled
+	chunks chunkStreams
+	// ttl is the number of Raft log entries client sessions are protected from
+	// eviction after their last activity, 0 means sessions are always evicted
+	// in LRU order.
+	ttl uint64
 }
 
 var _ ILoadable = (*SessionManager)(nil)
 
 // NewSessionManager returns a new SessionManager instance.
 func NewSessionManager() *SessionManager {
+	return newSessionManager(0)
+}
+
+func newSessionManager(ttl uint64) *SessionManager {
 	return &SessionManager{
 		lru: newLRUSession(LRUMaxSessionCount),
+		ttl: ttl,
 	}
 }
 
@@ -48,24 +100,67 @@ func (ds *SessionManager) UpdateRespondedTo(session *Session,
 	session.clearTo(RaftSeriesID(respondedTo))
 }
 
-// RegisterClientID registers a new client, it returns the input client id
-// if it is previously unknown, or 0 when the client has already been
-// registered.
-func (ds *SessionManager) RegisterClientID(clientID uint64) sm.Result {
+// RegisterClientID registers a new client in the Raft log entry with the
+// specified index, it returns the input client id if it is previously unknown,
+// or 0 when the client has already been registered. When the session TTL is
+// enabled and the registration would exceed the maximum number of client
+// sessions while the least recently used one is still within the TTL, the
+// registration is rejected with a result recognized by
+// IsSessionCapacityResult.
+func (ds *SessionManager) RegisterClientID(clientID uint64,
+	index uint64) sm.Result {
 	es, ok := ds.lru.getSession(RaftClientID(clientID))
 	if ok {
 		if es.ClientID != RaftClientID(clientID) {
 			plog.Panicf("returned an expected session, got id %d, want %d",
 				es.ClientID, clientID)
 		}
+		ds.touch(es, index)
 		plog.Warningf("client ID %d already exist", clientID)
 		return sm.Result{}
 	}
+	if !ds.makeRoom(index) {
+		plog.Warningf("client ID %d rejected, too many active sessions", clientID)
+		return SessionCapacityResult()
+	}
 	s := newSession(RaftClientID(clientID))
+	ds.touch(s, index)
 	ds.lru.addSession(RaftClientID(clientID), *s)
+	ds.assertSession(clientID, s)
 	return sm.Result{Value: clientID}
 }
 
+// makeRoom makes room for registering a new client session in the Raft log
+// entry with the specified index when the session TTL is enabled. The least
+// recently used client session is evicted when it has been inactive for more
+// than the TTL. It returns a boolean value indicating whether the new client
+// session can be registered. Eviction is left to the LRU policy when the
+// session TTL is not enabled.
+func (ds *SessionManager) makeRoom(index uint64) bool {
+	if ds.ttl == 0 || uint64(ds.lru.sessions.Len()) < ds.lru.size {
+		return true
+	}
+	oldest, ok := ds.lru.getOldestSession()
+	if !ok {
+		plog.Panicf("no session, max %d", ds.lru.size)
+	}
+	if index <= oldest.LastActive || index-oldest.LastActive <= ds.ttl {
+		return false
+	}
+	plog.Warningf("session with client id %d evicted, inactive since %d",
+		oldest.ClientID, oldest.LastActive)
+	ds.lru.delSession(oldest.ClientID)
+	return true
+}
+
+// touch records the activity of the client session in the Raft log entry
+// with the specified index.
+func (ds *SessionManager) touch(s *Session, index uint64) {
+	if ds.ttl > 0 {
+		s.LastActive = index
+	}
+}
+
 // UnregisterClientID removes the specified client session from the system.
 // It returns the client id if the client is successfully removed, or 0
 // if the client session does not exist.
@@ -108,6 +203,55 @@ func (ds *SessionManager) UpdateRequired(session *Session,
 	return sm.Result{}, false, true
 }
 
+// checkProposal updates the responded to value of the client session
+// identified by clientID and checks how the proposal with the specified series
+// id in the Raft log entry with the specified index should be handled. The
+// recorded result is returned for proposals already responded. The client
+// session is returned unless the proposal is rejected.
+func (ds *SessionManager) checkProposal(clientID uint64, seriesID uint64,
+	respondedTo uint64, index uint64) (*Session, sm.Result, proposalStatus) {
+	session, ok := ds.ClientRegistered(clientID)
+	if !ok {
+		return nil, sm.Result{}, proposalRejected
+	}
+	ds.touch(session, index)
+	ds.UpdateRespondedTo(session, respondedTo)
+	ds.assertSession(clientID, session)
+	v, responded, toUpdate := ds.UpdateRequired(session, seriesID)
+	if responded {
+		return session, sm.Result{}, proposalIgnored
+	}
+	if !toUpdate {
+		return session, v, proposalResponded
+	}
+	ds.MustHaveClientSeries(session, seriesID)
+	return session, sm.Result{}, proposalUpdate
+}
+
+// assertSession panics in race builds when the client session violates the
+// session invariants.
+func (ds *SessionManager) assertSession(clientID uint64, s *Session) {
+	if !invariants.Race {
+		return
+	}
+	if s.ClientID != RaftClientID(clientID) {
+		plog.Panicf("unexpected session, got id %d, want %d",
+			s.ClientID, clientID)
+	}
+	if s.History == nil {
+		plog.Panicf("session %d has no history", clientID)
+	}
+	for id := range s.History {
+		if id <= s.RespondedUpTo {
+			plog.Panicf("session %d has response of series %d, responded to %d",
+				clientID, id, s.RespondedUpTo)
+		}
+	}
+	if n := uint64(ds.lru.sessions.Len()); n > ds.lru.size {
+		plog.Panicf("%d sessions, max %d", n, ds.lru.size)
+	}
+}
+
 // MustHaveClientSeries checks whether the session manager contains a client
 // session identified as clientID and whether it has seriesID responded.
 func (ds *SessionManager) MustHaveClientSeries(session *Session,
@@ -122,14 +266,62 @@ func (ds *SessionManager) MustHaveClientSeries(session *Session,
 func (ds *SessionManager) AddResponse(session *Session,
 	seriesID uint64, result sm.Result) {
 	session.addResponse(RaftSeriesID(seriesID), result)
+	ds.assertSession(uint64(session.ClientID), session)
 }
 
 // SaveSessions saves the sessions to the provided io.writer.
 func (ds *SessionManager) SaveSessions(writer io.Writer) error {
-	return ds.lru.save(writer)
+	return ds.saveSessions(writer, 0, 0)
+}
+
+// saveSessions saves the sessions to the provided io.Writer along with chunked
+// proposals not dead once the entry with the specified index and term is
+// applied, dead ones are garbage collected this way. All chunked proposals are
+// saved when index is 0. Chunked proposals are saved after sessions with the
+// hasChunkStreams flag set, the saved data is thus unchanged when there is no
+// chunked proposal.
+func (ds *SessionManager) saveSessions(writer io.Writer,
+	index uint64, term uint64) error {
+	ids := ds.chunks.live(index, term)
+	if len(ids) == 0 {
+		return ds.lru.save(writer)
+	}
+	if err := ds.lru.saveWithFlags(writer, hasChunkStreams); err != nil {
+		return err
+	}
+	return ds.chunks.save(writer, ids)
 }
 
 // LoadSessions loads and restores sessions from io.Reader.
 func (ds *SessionManager) LoadSessions(reader io.Reader, v SSVersion) error {
-	return ds.lru.load(reader, v)
+	flags, err := ds.lru.loadWithFlags(reader, v)
+	if err != nil {
+		return err
+	}
+	if flags&hasChunkStreams != 0 {
+		if err := ds.chunks.load(reader); err != nil {
+			return err
+		}
+	} else {
+		ds.chunks = chunkStreams{}
+	}
+	if invariants.Race {
+		ds.lru.sessions.Do(func(k, v interface{}) {
+			ds.assertSession(uint64(*k.(*RaftClientID)), v.(*Session))
+		})
+	}
+	return nil
+}
+
+// addChunk adds the chunk in the specified chunk entry to its chunked
+// proposal.
+func (ds *SessionManager) addChunk(e pb.Entry) error {
+	return ds.chunks.add(e)
+}
+
+// takeChunks removes the chunked proposal of the specified manifest entry and
+// returns its reassembled payload, the returned boolean value indicates
+// whether all chunks are available.
+func (ds *SessionManager) takeChunks(e pb.Entry) ([]byte, bool) {
+	return ds.chunks.take(e)
 }
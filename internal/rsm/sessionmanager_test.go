@@ -16,10 +16,15 @@ package rsm
 
 import (
 	"bytes"
+	"fmt"
+	"math/rand"
+	"reflect"
 	"testing"
+	"testing/quick"
 
 	"github.com/lni/goutils/cache"
 
+	"github.com/lni/dragonboat/v4/client"
 	sm "github.com/lni/dragonboat/v4/statemachine"
 )
 
@@ -30,7 +35,7 @@ func TestRegisteriAndUnregisterClient(t *testing.T) {
 	if ok {
 		t.Errorf("already has client with client id 123")
 	}
-	sm.RegisterClientID(123)
+	sm.RegisterClientID(123, 1)
 	_, ok = sm.ClientRegistered(123)
 	if !ok {
 		t.Errorf("client not registered")
@@ -58,7 +63,7 @@ func TestSessionSaveOrderWithEviction(t *testing.T) {
 	sm2 := &SessionManager{lru: newLRUSession(4)}
 
 	for i := uint64(0); i < sm1.lru.size; i++ {
-		sm1.RegisterClientID(i)
+		sm1.RegisterClientID(i, i+1)
 	}
 	// touch the oldest session to make it the most recently accessed
 	s, ok := sm1.ClientRegistered(uint64(0))
@@ -75,10 +80,10 @@ func TestSessionSaveOrderWithEviction(t *testing.T) {
 		t.Fatalf("failed to restore snapshot %v", err)
 	}
 	// client with the same client id (1 and 2 here) expected to be evicted
-	sm1.RegisterClientID(sm1.lru.size)
-	sm2.RegisterClientID(sm1.lru.size)
-	sm1.RegisterClientID(sm1.lru.size + 1)
-	sm2.RegisterClientID(sm1.lru.size + 1)
+	sm1.RegisterClientID(sm1.lru.size, 10)
+	sm2.RegisterClientID(sm1.lru.size, 10)
+	sm1.RegisterClientID(sm1.lru.size+1, 11)
+	sm2.RegisterClientID(sm1.lru.size+1, 11)
 	s1 := &bytes.Buffer{}
 	if err := sm1.SaveSessions(s1); err != nil {
 		t.Fatalf("failed to save snapshot %v", err)
@@ -109,3 +114,479 @@ func TestSessionSaveOrderWithEviction(t *testing.T) {
 	check(sm1.lru.sessions)
 	check(sm2.lru.sessions)
 }
+
+func TestCheckProposal(t *testing.T) {
+	ds := NewSessionManager()
+	if _, _, status := ds.checkProposal(123, 1, 0, 1); status != proposalRejected {
+		t.Errorf("proposal from unregistered client not rejected")
+	}
+	ds.RegisterClientID(123, 2)
+	s, _, status := ds.checkProposal(123, 1, 0, 3)
+	if status != proposalUpdate {
+		t.Fatalf("unexpected status %d", status)
+	}
+	ds.AddResponse(s, 1, sm.Result{Value: 456})
+	if _, v, status := ds.checkProposal(123, 1, 0, 4); status != proposalResponded ||
+		v.Value != 456 {
+		t.Errorf("unexpected status %d, result %d", status, v.Value)
+	}
+	if _, _, status := ds.checkProposal(123, 2, 1, 5); status != proposalUpdate {
+		t.Errorf("unexpected status %d", status)
+	}
+	if _, _, status := ds.checkProposal(123, 1, 0, 6); status != proposalIgnored {
+		t.Errorf("unexpected status %d", status)
+	}
+}
+
+func getTTLSessionManager(size uint64, ttl uint64) *SessionManager {
+	return &SessionManager{lru: newLRUSession(size), ttl: ttl}
+}
+
+func TestSessionWithinTTLIsNotEvicted(t *testing.T) {
+	ds := getTTLSessionManager(2, 10)
+	ds.RegisterClientID(1, 1)
+	ds.RegisterClientID(2, 2)
+	for _, index := range []uint64{5, 11} {
+		if r := ds.RegisterClientID(3, index); !IsSessionCapacityResult(r) {
+			t.Errorf("index %d, registration not rejected, %v", index, r)
+		}
+	}
+	if _, ok := ds.ClientRegistered(3); ok {
+		t.Errorf("rejected client registered")
+	}
+	if r := ds.RegisterClientID(3, 12); r.Value != 3 {
+		t.Fatalf("registration rejected, %v", r)
+	}
+	if _, ok := ds.ClientRegistered(1); ok {
+		t.Errorf("inactive client session not evicted")
+	}
+	if _, ok := ds.ClientRegistered(2); !ok {
+		t.Errorf("active client session evicted")
+	}
+}
+
+func TestProposalKeepsSessionActive(t *testing.T) {
+	ds := getTTLSessionManager(2, 10)
+	ds.RegisterClientID(1, 1)
+	ds.RegisterClientID(2, 2)
+	s, _, status := ds.checkProposal(1, client.SeriesIDFirstProposal, 0, 8)
+	if status != proposalUpdate {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if s.LastActive != 8 {
+		t.Errorf("last active %d, want 8", s.LastActive)
+	}
+	// client 2 is now the least recently used one, it is evicted once it has
+	// been inactive for more than 10 entries
+	if r := ds.RegisterClientID(3, 12); !IsSessionCapacityResult(r) {
+		t.Errorf("registration not rejected, %v", r)
+	}
+	if r := ds.RegisterClientID(3, 13); r.Value != 3 {
+		t.Fatalf("registration rejected, %v", r)
+	}
+	if _, ok := ds.ClientRegistered(2); ok {
+		t.Errorf("inactive client session not evicted")
+	}
+	if _, ok := ds.ClientRegistered(1); !ok {
+		t.Errorf("active client session evicted")
+	}
+}
+
+func TestLastActiveIsNotRecordedWithoutTTL(t *testing.T) {
+	ds := getTTLSessionManager(2, 0)
+	ds.RegisterClientID(1, 1)
+	ds.RegisterClientID(2, 2)
+	if r := ds.RegisterClientID(3, 3); r.Value != 3 {
+		t.Fatalf("registration rejected, %v", r)
+	}
+	ds.lru.sessions.Do(func(k, v interface{}) {
+		if s := v.(*Session); s.LastActive != 0 {
+			t.Errorf("session %d last active %d", s.ClientID, s.LastActive)
+		}
+	})
+	ss := &bytes.Buffer{}
+	if err := ds.SaveSessions(ss); err != nil {
+		t.Fatalf("failed to save sessions %v", err)
+	}
+	if bytes.Contains(ss.Bytes(), []byte("LastActive")) {
+		t.Errorf("last active unexpectedly saved")
+	}
+}
+
+func TestSessionTTLBookkeepingIsSavedAndLoaded(t *testing.T) {
+	sm1 := getTTLSessionManager(3, 10)
+	sm1.RegisterClientID(1, 1)
+	sm1.RegisterClientID(2, 2)
+	sm1.RegisterClientID(3, 3)
+	if _, _, status := sm1.checkProposal(1,
+		client.SeriesIDFirstProposal, 0, 4); status != proposalUpdate {
+		t.Fatalf("unexpected status %d", status)
+	}
+	ss := &bytes.Buffer{}
+	if err := sm1.SaveSessions(ss); err != nil {
+		t.Fatalf("failed to save sessions %v", err)
+	}
+	sm2 := getTTLSessionManager(3, 10)
+	if err := sm2.LoadSessions(bytes.NewBuffer(ss.Bytes()), V2); err != nil {
+		t.Fatalf("failed to load sessions %v", err)
+	}
+	if sm1.GetSessionHash() != sm2.GetSessionHash() {
+		t.Fatalf("session hash changed")
+	}
+	lastActive := func(ds *SessionManager) map[uint64]uint64 {
+		result := make(map[uint64]uint64)
+		ds.lru.sessions.OrderedDo(func(k, v interface{}) {
+			result[uint64(*k.(*RaftClientID))] = v.(*Session).LastActive
+		})
+		return result
+	}
+	expected := map[uint64]uint64{1: 4, 2: 2, 3: 3}
+	for _, ds := range []*SessionManager{sm1, sm2} {
+		if v := lastActive(ds); !reflect.DeepEqual(v, expected) {
+			t.Errorf("last active %v, want %v", v, expected)
+		}
+	}
+	// both replicas are expected to make the same eviction decisions
+	for _, index := range []uint64{12, 13, 14} {
+		r1 := sm1.RegisterClientID(index, index)
+		r2 := sm2.RegisterClientID(index, index)
+		if !reflect.DeepEqual(r1, r2) {
+			t.Errorf("index %d, results %v and %v", index, r1, r2)
+		}
+		if sm1.GetSessionHash() != sm2.GetSessionHash() {
+			t.Errorf("index %d, session hash differs", index)
+		}
+	}
+	for _, ds := range []*SessionManager{sm1, sm2} {
+		if _, ok := ds.ClientRegistered(2); ok {
+			t.Errorf("client 2 not evicted")
+		}
+		if _, ok := ds.ClientRegistered(3); ok {
+			t.Errorf("client 3 not evicted")
+		}
+		if _, ok := ds.ClientRegistered(1); !ok {
+			t.Errorf("client 1 evicted")
+		}
+	}
+}
+
+func TestSessionsSavedWithoutLastActiveCanBeLoaded(t *testing.T) {
+	sm1 := getTTLSessionManager(2, 0)
+	sm1.RegisterClientID(1, 1)
+	sm1.RegisterClientID(2, 2)
+	ss := &bytes.Buffer{}
+	if err := sm1.SaveSessions(ss); err != nil {
+		t.Fatalf("failed to save sessions %v", err)
+	}
+	sm2 := getTTLSessionManager(2, 10)
+	if err := sm2.LoadSessions(ss, V2); err != nil {
+		t.Fatalf("failed to load sessions %v", err)
+	}
+	// sessions without recorded activity are considered as inactive since the
+	// beginning of the log
+	if r := sm2.RegisterClientID(3, 10); !IsSessionCapacityResult(r) {
+		t.Errorf("registration not rejected, %v", r)
+	}
+	if r := sm2.RegisterClientID(3, 11); r.Value != 3 {
+		t.Errorf("registration rejected, %v", r)
+	}
+}
+
+const (
+	opRegister = iota
+	opUnregister
+	opPropose
+	opRetry
+	opComplete
+	opEvict
+	opSnapshot
+	opCount
+)
+
+var opNames = []string{
+	"register", "unregister", "propose", "retry", "complete", "evict", "snapshot",
+}
+
+const (
+	modelClientCount  = 5
+	modelSessionLimit = 3
+)
+
+type sessionOp struct {
+	kind   int
+	client int
+	n      uint64
+}
+
+func (op sessionOp) String() string {
+	return fmt.Sprintf("%s(%d,%d)", opNames[op.kind], op.client, op.n)
+}
+
+// sessionOps is a random sequence of client session operations, it
+// implements the quick.Generator interface.
+type sessionOps []sessionOp
+
+func (sessionOps) Generate(r *rand.Rand, size int) reflect.Value {
+	ops := make(sessionOps, r.Intn(4*size+1))
+	for i := range ops {
+		ops[i] = sessionOp{
+			kind:   r.Intn(opCount),
+			client: r.Intn(modelClientCount),
+			n:      uint64(r.Intn(4)),
+		}
+	}
+	return reflect.ValueOf(ops)
+}
+
+type modelSession struct {
+	respondedTo uint64
+	history     map[uint64]uint64
+}
+
+// sessionModel is a straightforward implementation of the client sessions
+// managed by SessionManager, sessions are kept in a slice in LRU order.
+type sessionModel struct {
+	order    []uint64
+	sessions map[uint64]*modelSession
+}
+
+func newSessionModel() *sessionModel {
+	return &sessionModel{sessions: make(map[uint64]*modelSession)}
+}
+
+func (m *sessionModel) remove(clientID uint64) {
+	for i, id := range m.order {
+		if id == clientID {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *sessionModel) touch(clientID uint64) {
+	m.remove(clientID)
+	m.order = append(m.order, clientID)
+}
+
+func (m *sessionModel) register(clientID uint64) uint64 {
+	if _, ok := m.sessions[clientID]; ok {
+		m.touch(clientID)
+		return 0
+	}
+	m.sessions[clientID] = &modelSession{history: make(map[uint64]uint64)}
+	m.order = append(m.order, clientID)
+	for len(m.order) > modelSessionLimit {
+		delete(m.sessions, m.order[0])
+		m.order = m.order[1:]
+	}
+	return clientID
+}
+
+func (m *sessionModel) unregister(clientID uint64) uint64 {
+	if _, ok := m.sessions[clientID]; !ok {
+		return 0
+	}
+	delete(m.sessions, clientID)
+	m.remove(clientID)
+	return clientID
+}
+
+func (m *sessionModel) propose(clientID uint64,
+	seriesID uint64, respondedTo uint64) (proposalStatus, uint64) {
+	s, ok := m.sessions[clientID]
+	if !ok {
+		return proposalRejected, 0
+	}
+	m.touch(clientID)
+	if respondedTo > s.respondedTo {
+		s.respondedTo = respondedTo
+		for id := range s.history {
+			if id <= respondedTo {
+				delete(s.history, id)
+			}
+		}
+	}
+	if seriesID <= s.respondedTo {
+		return proposalIgnored, 0
+	}
+	if v, ok := s.history[seriesID]; ok {
+		return proposalResponded, v
+	}
+	s.history[seriesID] = proposalResult(clientID, seriesID)
+	return proposalUpdate, 0
+}
+
+func proposalResult(clientID uint64, seriesID uint64) uint64 {
+	return clientID<<32 | seriesID
+}
+
+// compareSessions returns an error when the sessions managed by ds are
+// observably different from the modelled ones, including their LRU order.
+func compareSessions(ds *SessionManager, m *sessionModel) error {
+	var order []uint64
+	ds.lru.sessions.OrderedDo(func(k, v interface{}) {
+		order = append(order, uint64(*k.(*RaftClientID)))
+	})
+	if !reflect.DeepEqual(order, m.order) &&
+		(len(order) != 0 || len(m.order) != 0) {
+		return fmt.Errorf("LRU order %v, want %v", order, m.order)
+	}
+	var err error
+	ds.lru.sessions.Do(func(k, v interface{}) {
+		s := v.(*Session)
+		ms := m.sessions[uint64(s.ClientID)]
+		if ms == nil {
+			err = fmt.Errorf("unexpected session %d", s.ClientID)
+			return
+		}
+		if uint64(s.RespondedUpTo) != ms.respondedTo {
+			err = fmt.Errorf("session %d responded to %d, want %d",
+				s.ClientID, s.RespondedUpTo, ms.respondedTo)
+			return
+		}
+		history := make(map[uint64]uint64)
+		for id, r := range s.History {
+			history[uint64(id)] = r.Value
+		}
+		if !reflect.DeepEqual(history, ms.history) {
+			err = fmt.Errorf("session %d history %v, want %v",
+				s.ClientID, history, ms.history)
+		}
+	})
+	return err
+}
+
+// runSessionOps applies ops to both a SessionManager and the model, clients
+// are driven by client.Session instances. It returns the first observed
+// difference.
+func runSessionOps(ops sessionOps) error {
+	ds := &SessionManager{lru: newLRUSession(modelSessionLimit)}
+	m := newSessionModel()
+	clients := make([]*client.Session, modelClientCount)
+	for i := range clients {
+		clients[i] = &client.Session{
+			ShardID:  1,
+			ClientID: uint64(i + 1),
+			SeriesID: client.SeriesIDFirstProposal,
+		}
+	}
+	nextClientID := uint64(modelClientCount + 1)
+	// index is the index of the Raft log entry of the last operation
+	index := uint64(0)
+	propose := func(clientID uint64, seriesID uint64, respondedTo uint64) error {
+		index++
+		s, v, status := ds.checkProposal(clientID, seriesID, respondedTo, index)
+		if status == proposalUpdate {
+			ds.AddResponse(s, seriesID,
+				sm.Result{Value: proposalResult(clientID, seriesID)})
+		}
+		ms, mv := m.propose(clientID, seriesID, respondedTo)
+		if status != ms || v.Value != mv {
+			return fmt.Errorf("proposal %d:%d:%d, status %d, result %d, "+
+				"want status %d, result %d",
+				clientID, seriesID, respondedTo, status, v.Value, ms, mv)
+		}
+		return nil
+	}
+	for idx, op := range ops {
+		c := clients[op.client]
+		var err error
+		switch op.kind {
+		case opRegister:
+			index++
+			if v, mv := ds.RegisterClientID(c.ClientID, index).Value,
+				m.register(c.ClientID); v != mv {
+				err = fmt.Errorf("register returned %d, want %d", v, mv)
+			}
+		case opUnregister:
+			if v, mv := ds.UnregisterClientID(c.ClientID).Value,
+				m.unregister(c.ClientID); v != mv {
+				err = fmt.Errorf("unregister returned %d, want %d", v, mv)
+			}
+		case opPropose:
+			err = propose(c.ClientID, c.SeriesID, c.RespondedTo)
+		case opRetry:
+			// a delayed duplicate of an earlier proposal
+			seriesID := c.SeriesID - op.n
+			if op.n >= c.SeriesID {
+				seriesID = client.SeriesIDFirstProposal
+			}
+			err = propose(c.ClientID, seriesID, seriesID-1)
+		case opComplete:
+			// proposals are completed in the same way when aborted
+			c.ProposalCompleted()
+		case opEvict:
+			for i := uint64(0); i <= op.n; i++ {
+				index++
+				ds.RegisterClientID(nextClientID, index)
+				m.register(nextClientID)
+				nextClientID++
+			}
+		case opSnapshot:
+			ss := &bytes.Buffer{}
+			if err := ds.SaveSessions(ss); err != nil {
+				return err
+			}
+			ds = NewSessionManager()
+			if err := ds.LoadSessions(ss, V2); err != nil {
+				return err
+			}
+		}
+		if err == nil {
+			err = compareSessions(ds, m)
+		}
+		if err != nil {
+			return fmt.Errorf("op %d %s, %v", idx, op, err)
+		}
+	}
+	return nil
+}
+
+// minimizeSessionOps repeatedly removes operations from the failed ops as long
+// as the remaining ones still fail.
+func minimizeSessionOps(ops sessionOps) sessionOps {
+	for removed := true; removed; {
+		removed = false
+		for i := len(ops) - 1; i >= 0; i-- {
+			candidate := append(append(sessionOps{}, ops[:i]...), ops[i+1:]...)
+			if runSessionOps(candidate) != nil {
+				ops = candidate
+				removed = true
+			}
+		}
+	}
+	return ops
+}
+
+func TestSessionManagerMatchesModel(t *testing.T) {
+	f := func(ops sessionOps) bool {
+		return runSessionOps(ops) == nil
+	}
+	cfg := &quick.Config{MaxCount: 2000, Rand: rand.New(rand.NewSource(1))}
+	if err := quick.Check(f, cfg); err != nil {
+		ce, ok := err.(*quick.CheckError)
+		if !ok {
+			t.Fatalf("check failed %v", err)
+		}
+		ops := minimizeSessionOps(ce.In[0].(sessionOps))
+		t.Fatalf("session manager diverged from the model, ops %v, %v",
+			ops, runSessionOps(ops))
+	}
+}
+
+func TestLoadedSessionsMatchModel(t *testing.T) {
+	ops := sessionOps{
+		{kind: opRegister, client: 0},
+		{kind: opRegister, client: 1},
+		{kind: opPropose, client: 0},
+		{kind: opRegister, client: 2},
+		{kind: opPropose, client: 1},
+		{kind: opSnapshot},
+		// client 2 is the least recently used one after restoring
+		{kind: opEvict},
+		{kind: opPropose, client: 2},
+	}
+	if err := runSessionOps(ops); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
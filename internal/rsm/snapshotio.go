@@ -24,6 +24,7 @@ import (
 
 	"github.com/lni/dragonboat/v4/internal/fileutil"
 	"github.com/lni/dragonboat/v4/internal/settings"
+	"github.com/lni/dragonboat/v4/internal/utils/dio"
 	"github.com/lni/dragonboat/v4/internal/vfs"
 	pb "github.com/lni/dragonboat/v4/raftpb"
 )
@@ -129,36 +130,6 @@ func getVersionedValidator(header pb.SnapshotHeader) (IVValidator, bool) {
 	return nil, false
 }
 
-// GetWitnessSnapshot returns the content of a witness snapshot.
-func GetWitnessSnapshot(fs vfs.IFS) (result []byte, err error) {
-	f, path, err := fileutil.TempFile("", "dragonboat-witness-snapshot", fs)
-	if err != nil {
-		return nil, err
-	}
-	w, err := newSnapshotWriter(f, path, DefaultVersion, pb.NoCompression, fs)
-	if err != nil {
-		return nil, err
-	}
-	if _, err := w.Write(GetEmptyLRUSession()); err != nil {
-		return nil, err
-	}
-	if err := w.Close(); err != nil {
-		return nil, err
-	}
-	df, err := fs.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		err = firstError(err, df.Close())
-	}()
-	buf := bytes.NewBuffer(nil)
-	if _, err = io.Copy(buf, df); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
 // SnapshotWriter is an io.Writer used to write snapshot file.
 type SnapshotWriter struct {
 	vw     IVWriter
@@ -266,6 +237,80 @@ func (sw *SnapshotWriter) saveHeader() error {
 	return nil
 }
 
+// getV2Header returns the V2 snapshot header written before the payload is
+// known. The PayloadChecksum field is not used by V2 readers, block checksums
+// are validated instead.
+func getV2Header(ct pb.CompressionType) []byte {
+	header := pb.SnapshotHeader{
+		SessionSize:     0,
+		DataStoreSize:   0,
+		UnreliableTime:  uint64(time.Now().UnixNano()),
+		PayloadChecksum: []byte{0, 0, 0, 0},
+		ChecksumType:    DefaultChecksumType,
+		Version:         uint64(V2),
+		CompressionType: ct,
+	}
+	data := pb.MustMarshal(&header)
+	h := newCRC32Hash()
+	fileutil.MustWrite(h, data)
+	checksum := h.Sum(nil)
+	result := make([]byte, HeaderSize)
+	binary.LittleEndian.PutUint64(result, uint64(len(data)))
+	copy(result[8:], data)
+	copy(result[8+len(data):], checksum)
+	return result
+}
+
+// SnapshotStreamWriter is an io.WriteCloser used to write a snapshot image to
+// a non-seekable io.WriteCloser, e.g. an object being uploaded to an object
+// store. The snapshot header is written before the payload.
+type SnapshotStreamWriter struct {
+	vw     IVWriter
+	w      io.WriteCloser
+	closed bool
+}
+
+// NewSnapshotStreamWriter creates a new snapshot stream writer instance. w is
+// closed when the returned writer is closed.
+func NewSnapshotStreamWriter(w io.WriteCloser,
+	ct pb.CompressionType) (*SnapshotStreamWriter, error) {
+	if _, err := w.Write(getV2Header(ct)); err != nil {
+		return nil, err
+	}
+	return &SnapshotStreamWriter{
+		vw: mustGetVersionedWriter(w, V2),
+		w:  w,
+	}, nil
+}
+
+// Close closes the snapshot stream writer instance.
+func (sw *SnapshotStreamWriter) Close() (err error) {
+	sw.closed = true
+	err = firstError(err, sw.vw.Close())
+	return firstError(err, sw.w.Close())
+}
+
+// Write writes the specified data to the snapshot.
+func (sw *SnapshotStreamWriter) Write(data []byte) (int, error) {
+	return sw.vw.Write(data)
+}
+
+// GetPayloadSize returns the payload size.
+func (sw *SnapshotStreamWriter) GetPayloadSize(sz uint64) uint64 {
+	if !sw.closed {
+		panic("not closed")
+	}
+	return sw.vw.GetPayloadSize(sz)
+}
+
+// GetPayloadChecksum returns the payload checksum.
+func (sw *SnapshotStreamWriter) GetPayloadChecksum() []byte {
+	if !sw.closed {
+		panic("not closed")
+	}
+	return sw.vw.GetPayloadSum()
+}
+
 // SnapshotReader is an io.Reader for reading from snapshot files.
 type SnapshotReader struct {
 	r      IVReader
@@ -392,7 +437,10 @@ func (v *SnapshotValidator) AddChunk(data []byte, chunkID uint64) bool {
 			return false
 		}
 		var headerRec pb.SnapshotHeader
-		pb.MustUnmarshal(&headerRec, header)
+		if err := headerRec.Unmarshal(header); err != nil {
+			plog.Errorf("failed to unmarshal header, %v", err)
+			return false
+		}
 		v.v, ok = getVersionedValidator(headerRec)
 		if !ok {
 			return false
@@ -475,6 +523,48 @@ func ShrinkSnapshot(fp string, newFp string, fs vfs.IFS) (err error) {
 	return nil
 }
 
+// StripSessions saves a copy of the specified snapshot file with all client
+// sessions and chunked proposals removed to the path specified by newFp, the state machine payload
+// is copied as is. The payload checksum and the size of the generated file are
+// returned.
+func StripSessions(fp string,
+	newFp string, fs vfs.IFS) (checksum []byte, sz uint64, err error) {
+	mustInSameDir(fp, newFp, fs)
+	reader, header, err := NewSnapshotReader(fp, fs)
+	if err != nil {
+		return nil, 0, err
+	}
+	ct := ToDioType(header.CompressionType)
+	dr := dio.NewDecompressor(ct, reader)
+	defer func() {
+		err = firstError(err, dr.Close())
+	}()
+	if err := newSessionManager(0).LoadSessions(dr,
+		SSVersion(header.Version)); err != nil {
+		return nil, 0, err
+	}
+	writer, err := NewSnapshotWriter(newFp, header.CompressionType, fs)
+	if err != nil {
+		return nil, 0, err
+	}
+	cw := dio.NewCountedWriter(writer)
+	sw := dio.NewCompressor(ct, cw)
+	defer func() {
+		err = firstError(err, sw.Close())
+		if err == nil {
+			checksum = writer.GetPayloadChecksum()
+			sz = writer.GetPayloadSize(cw.BytesWritten()) + HeaderSize
+		}
+	}()
+	if _, err := sw.Write(GetEmptyLRUSession()); err != nil {
+		return nil, 0, err
+	}
+	if _, err := io.Copy(sw, dr); err != nil {
+		return nil, 0, err
+	}
+	return nil, 0, nil
+}
+
 // ReplaceSnapshot replace the specified snapshot file with the shrunk
 // version atomically.
 func ReplaceSnapshot(newFp string, fp string, fs vfs.IFS) error {
@@ -21,6 +21,7 @@ import (
 	"io"
 	"testing"
 
+	"github.com/lni/dragonboat/v4/internal/utils/dio"
 	"github.com/lni/dragonboat/v4/internal/vfs"
 	pb "github.com/lni/dragonboat/v4/raftpb"
 )
@@ -584,14 +585,131 @@ func TestValidateHeader(t *testing.T) {
 	}
 }
 
-func TestGetWitnessSnapshot(t *testing.T) {
+func TestSnapshotStreamWriterOutputCanBeRead(t *testing.T) {
 	fs := vfs.GetTestFS()
-	if d, err := GetWitnessSnapshot(fs); err != nil {
-		t.Fatalf("failed to get witness snapshot, %v", err)
-	} else {
-		data := GetEmptyLRUSession()
-		if uint64(len(d)) != HeaderSize+uint64(len(data))+20 {
-			t.Errorf("unexpected length, %d, data len %d", len(d), len(data))
+	for _, sz := range []uint64{blockSize - 1, blockSize*3 + 1} {
+		func() {
+			f, err := fs.Create(testSnapshotFilename)
+			if err != nil {
+				t.Fatalf("failed to create file %v", err)
+			}
+			defer func() {
+				if err := fs.RemoveAll(testSnapshotFilename); err != nil {
+					t.Fatalf("%v", err)
+				}
+			}()
+			w, err := NewSnapshotStreamWriter(f, pb.NoCompression)
+			if err != nil {
+				t.Fatalf("failed to create stream writer %v", err)
+			}
+			payload := make([]byte, sz)
+			if _, err := rand.Read(payload); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if _, err := w.Write(payload); err != nil {
+				t.Fatalf("write failed %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("close failed %v", err)
+			}
+			checksum, err := GetV2PayloadChecksum(testSnapshotFilename, fs)
+			if err != nil {
+				t.Fatalf("failed to get checksum %v", err)
+			}
+			if !bytes.Equal(checksum, w.GetPayloadChecksum()) {
+				t.Errorf("checksum changed")
+			}
+			r, header, err := NewSnapshotReader(testSnapshotFilename, fs)
+			if err != nil {
+				t.Fatalf("failed to create reader %v", err)
+			}
+			if header.Version != uint64(V2) {
+				t.Errorf("unexpected version %d", header.Version)
+			}
+			result := make([]byte, sz)
+			if _, err := io.ReadFull(r, result); err != nil {
+				t.Fatalf("read failed %v", err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if !bytes.Equal(payload, result) {
+				t.Errorf("payload changed")
+			}
+		}()
+	}
+	reportLeakedFD(fs, t)
+}
+
+func TestStripSessions(t *testing.T) {
+	fs := vfs.GetTestFS()
+	snapshotFilename := "test_snapshot_safe_to_delete.data"
+	strippedFilename := "test_snapshot_safe_to_delete.stripped"
+	defer func() {
+		for _, fn := range []string{snapshotFilename, strippedFilename} {
+			if err := fs.RemoveAll(fn); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+	}()
+	for _, ct := range []pb.CompressionType{pb.NoCompression, pb.Snappy} {
+		writer, err := NewSnapshotWriter(snapshotFilename, ct, fs)
+		if err != nil {
+			t.Fatalf("failed to get writer %v", err)
+		}
+		sw := dio.NewCompressor(ToDioType(ct), writer)
+		sessions := newLRUSession(LRUMaxSessionCount)
+		sessions.addSession(RaftClientID(123), *newSession(123))
+		if err := sessions.save(sw); err != nil {
+			t.Fatalf("failed to save sessions %v", err)
+		}
+		payload := make([]byte, 1024*1024)
+		_, _ = rand.Read(payload)
+		if _, err := sw.Write(payload); err != nil {
+			t.Fatalf("write failed %v", err)
+		}
+		if err := sw.Close(); err != nil {
+			t.Fatalf("close failed %v", err)
+		}
+		checksum, sz, err := StripSessions(snapshotFilename, strippedFilename, fs)
+		if err != nil {
+			t.Fatalf("failed to strip sessions %v", err)
+		}
+		fi, err := fs.Stat(strippedFilename)
+		if err != nil {
+			t.Fatalf("failed to stat %v", err)
+		}
+		if uint64(fi.Size()) != sz {
+			t.Errorf("size %d, want %d", sz, fi.Size())
+		}
+		v, err := GetV2PayloadChecksum(strippedFilename, fs)
+		if err != nil {
+			t.Fatalf("failed to get checksum %v", err)
+		}
+		if !bytes.Equal(v, checksum) {
+			t.Errorf("unexpected checksum")
+		}
+		reader, header, err := NewSnapshotReader(strippedFilename, fs)
+		if err != nil {
+			t.Fatalf("failed to get reader %v", err)
+		}
+		dr := dio.NewDecompressor(ToDioType(header.CompressionType), reader)
+		loaded := newLRUSession(LRUMaxSessionCount)
+		if err := loaded.load(dr, SSVersion(header.Version)); err != nil {
+			t.Fatalf("failed to load sessions %v", err)
+		}
+		if _, ok := loaded.getSession(RaftClientID(123)); ok {
+			t.Errorf("session not stripped")
+		}
+		data, err := io.ReadAll(dr)
+		if err != nil {
+			t.Fatalf("failed to read %v", err)
+		}
+		if !bytes.Equal(data, payload) {
+			t.Errorf("payload changed")
+		}
+		if err := dr.Close(); err != nil {
+			t.Fatalf("failed to close %v", err)
 		}
 	}
 }
@@ -22,6 +22,7 @@ package rsm
 
 import (
 	"bytes"
+	"io"
 	"sync"
 	"sync/atomic"
 
@@ -29,6 +30,7 @@ import (
 	"github.com/lni/goutils/logutil"
 
 	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/failpoint"
 	"github.com/lni/dragonboat/v4/internal/raft"
 	"github.com/lni/dragonboat/v4/internal/server"
 	"github.com/lni/dragonboat/v4/internal/settings"
@@ -40,7 +42,7 @@ import (
 )
 
 var (
-	plog = logger.GetLogger("rsm")
+	plog = logger.GetStructuredLogger("rsm")
 )
 
 var (
@@ -71,14 +73,30 @@ type SSEnv = server.SSEnv
 // DefaultSSRequest is the default SSRequest.
 var DefaultSSRequest = SSRequest{}
 
+// IExportSink is the destination of exported snapshot files, see the
+// ExportSink type in the dragonboat package for details.
+type IExportSink interface {
+	CreateFile(name string) (io.WriteCloser, error)
+	Commit(ss pb.Snapshot) error
+	Abort()
+}
+
 // SSRequest contains details of a snapshot request.
 type SSRequest struct {
 	Path               string
+	Sink               IExportSink
 	Type               SSReqType
 	Key                uint64
 	CompactionOverhead uint64
 	CompactionIndex    uint64
+	// LeaderTerm is the term in which the requesting replica is the leader, the
+	// snapshot is only committed when the replica is still the leader in that
+	// term. It is 0 when leadership is not required.
+	LeaderTerm         uint64
 	OverrideCompaction bool
+	// Prioritized indicates that the snapshot should be scheduled ahead of
+	// other snapshots waiting for their turn.
+	Prioritized bool
 }
 
 // Exported returns a boolean value indicating whether the snapshot request
@@ -105,6 +123,9 @@ type SSMeta struct {
 	Term            uint64
 	Type            pb.StateMachineType
 	CompressionType config.CompressionType
+	// Fingerprint is the fingerprint of the state machine at Index, it is 0
+	// when not available.
+	Fingerprint uint64
 }
 
 // Task describes a task that need to be handled by StateMachine.
@@ -144,7 +165,8 @@ type INode interface {
 	StepReady()
 	RestoreRemotes(pb.Snapshot) error
 	ApplyUpdate(pb.Entry, sm.Result, bool, bool, bool)
-	ApplyConfigChange(pb.ConfigChange, uint64, bool) error
+	ApplyConfigChange(pb.ConfigChange, uint64, bool, error) error
+	EntriesApplied([]pb.Entry)
 	ReplicaID() uint64
 	ShardID() uint64
 	ShouldStop() <-chan struct{}
@@ -179,18 +201,28 @@ type StateMachine struct {
 		index uint64
 		term  uint64
 	}
+	// applying is the index range of the entries being applied by the update
+	// goroutine, it is only accessed by the update goroutine
+	applying struct {
+		first uint64
+		last  uint64
+	}
 	// index and term values updated for each applied entry
 	index           uint64
 	term            uint64
 	snapshotIndex   uint64
+	recoveredIndex  uint64
 	onDiskInitIndex uint64
 	onDiskIndex     uint64
 	syncedIndex     uint64
 	mu              sync.RWMutex
-	sct             config.CompressionType
-	onDiskSM        bool
-	aborted         bool
-	isWitness       bool
+	// payloads is used for decoding compressed payloads when the user state
+	// machine never retains the Cmd of applied entries, it is nil otherwise.
+	payloads  *payloadBuffer
+	sct       config.CompressionType
+	onDiskSM  bool
+	aborted   bool
+	isWitness bool
 }
 
 var firstError = utils.FirstError
@@ -200,18 +232,26 @@ func NewStateMachine(sm IManagedStateMachine,
 	snapshotter ISnapshotter,
 	cfg config.Config, node INode, fs vfs.IFS) *StateMachine {
 	ordered := cfg.OrderedConfigChange
-	return &StateMachine{
+	members := newMembership(node.ShardID(), node.ReplicaID(), ordered)
+	if cfg.ConfigChangeHistorySize > 0 {
+		members.historySize = cfg.ConfigChangeHistorySize
+	}
+	s := &StateMachine{
 		snapshotter: snapshotter,
 		sm:          sm,
 		onDiskSM:    sm.OnDisk(),
 		taskQ:       NewTaskQueue(),
 		node:        node,
-		sessions:    NewSessionManager(),
-		members:     newMembership(node.ShardID(), node.ReplicaID(), ordered),
+		sessions:    newSessionManager(cfg.SessionTTLEntries),
+		members:     members,
 		isWitness:   cfg.IsWitness,
 		sct:         cfg.SnapshotCompressionType,
 		fs:          fs,
 	}
+	if sm.NonRetaining() {
+		s.payloads = &payloadBuffer{}
+	}
+	return s
 }
 
 // Type returns the state machine type.
@@ -363,6 +403,9 @@ func (s *StateMachine) recover(ss pb.Snapshot, init bool) error {
 	if err := s.doRecover(ss, init); err != nil {
 		return err
 	}
+	if err := failpoint.Inject(failpoint.BeforeRecoverFromSnapshot); err != nil {
+		return err
+	}
 	s.apply(ss, init)
 	return nil
 }
@@ -411,6 +454,7 @@ func (s *StateMachine) load(ss pb.Snapshot, init bool) error {
 		}
 		return err
 	}
+	s.recoveredIndex = ss.Index
 	return nil
 }
 
@@ -420,7 +464,10 @@ func (s *StateMachine) apply(ss pb.Snapshot, init bool) {
 	s.logMembership("members", index, ss.Membership.Addresses)
 	s.logMembership("nonVotings", index, ss.Membership.NonVotings)
 	s.logMembership("witnesses", index, ss.Membership.Witnesses)
+	s.logMembership("outgoing", index, ss.Membership.Outgoing)
+	s.mu.Lock()
 	s.members.set(ss.Membership)
+	s.mu.Unlock()
 	s.lastApplied.Lock()
 	defer s.lastApplied.Unlock()
 	s.lastApplied.index, s.lastApplied.term = ss.Index, ss.Term
@@ -581,6 +628,23 @@ func (s *StateMachine) GetHash() (uint64, error) {
 	return s.sm.GetHash()
 }
 
+// GetFingerprint returns the fingerprint of the state machine when it has
+// been recovered from the specified snapshot and no entry has been applied
+// since. The returned boolean value is false when the state machine was not
+// recovered from the snapshot or no fingerprint is available.
+func (s *StateMachine) GetFingerprint(ss pb.Snapshot) (uint64, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.recoveredIndex != ss.Index || s.index != ss.Index {
+		return 0, false, nil
+	}
+	fp, err := s.getFingerprint()
+	if err != nil {
+		return 0, false, err
+	}
+	return fp, fp != 0, nil
+}
+
 // GetSessionHash returns the session hash.
 func (s *StateMachine) GetSessionHash() uint64 {
 	s.mu.RLock()
@@ -596,9 +660,9 @@ func (s *StateMachine) GetMembershipHash() uint64 {
 }
 
 // Handle pulls the committed record and apply it if there is any available.
-func (s *StateMachine) Handle(batch []Task, apply []sm.Entry) (Task, error) {
+func (s *StateMachine) Handle(batch []Task) (Task, error) {
 	batch = batch[:0]
-	apply = apply[:0]
+	s.applying.first, s.applying.last = 0, 0
 	processed := false
 	defer func() {
 		// give the node worker a chance to run when
@@ -624,7 +688,7 @@ func (s *StateMachine) Handle(batch []Task, apply []sm.Entry) (Task, error) {
 		for !done {
 			if rec, ok := s.taskQ.Get(); ok {
 				if rec.IsSnapshotTask() {
-					if err := s.handle(batch, apply); err != nil {
+					if err := s.handle(batch); err != nil {
 						return Task{}, err
 					}
 					return rec, nil
@@ -641,7 +705,7 @@ func (s *StateMachine) Handle(batch []Task, apply []sm.Entry) (Task, error) {
 			}
 		}
 	}
-	return Task{}, s.handle(batch, apply)
+	return Task{}, s.handle(batch)
 }
 
 func (s *StateMachine) isDummySnapshot(r SSRequest) bool {
@@ -679,7 +743,8 @@ func (s *StateMachine) getSSMeta(c interface{}, r SSRequest) (SSMeta, error) {
 		CompressionType: ct,
 	}
 	s.logMembership("members", meta.Index, meta.Membership.Addresses)
-	if err := s.sessions.SaveSessions(meta.Session); err != nil {
+	if err := s.sessions.saveSessions(meta.Session,
+		s.index, s.term); err != nil {
 		return SSMeta{}, err
 	}
 	return meta, nil
@@ -692,6 +757,14 @@ func (s *StateMachine) GetLastApplied() uint64 {
 	return s.lastApplied.index
 }
 
+// GetApplyingRange returns the index range of the entries being applied by the
+// current Handle call, 0, 0 is returned when no entry is being applied. It can
+// only be invoked from the goroutine invoking Handle, e.g. to annotate a panic
+// recovered from the Handle call.
+func (s *StateMachine) GetApplyingRange() (uint64, uint64) {
+	return s.applying.first, s.applying.last
+}
+
 // SetLastApplied sets the last applied index to the specified value. This
 // method is only used in tests.
 func (s *StateMachine) SetLastApplied(index uint64) {
@@ -833,7 +906,26 @@ func (s *StateMachine) prepare(r SSRequest) (SSMeta, error) {
 			return SSMeta{}, err
 		}
 	}
-	return s.getSSMeta(ctx, r)
+	meta, err := s.getSSMeta(ctx, r)
+	if err != nil {
+		return SSMeta{}, err
+	}
+	if !s.savingDummySnapshot(r) {
+		if meta.Fingerprint, err = s.getFingerprint(); err != nil {
+			return SSMeta{}, err
+		}
+	}
+	return meta, nil
+}
+
+// getFingerprint returns the fingerprint of the state machine, 0 is returned
+// when sm.IFingerprint is not implemented.
+func (s *StateMachine) getFingerprint() (uint64, error) {
+	fp, err := s.sm.Fingerprint()
+	if errors.Is(err, sm.ErrNotImplemented) {
+		return 0, nil
+	}
+	return fp, err
 }
 
 func (s *StateMachine) sync() error {
@@ -864,7 +956,9 @@ func getEntryTypes(entries []pb.Entry) (bool, bool) {
 	allUpdate := true
 	allNoOP := true
 	for _, v := range entries {
-		if allUpdate && !v.IsUpdateEntry() {
+		// chunked and fenced proposals are never batched
+		if allUpdate &&
+			(!v.IsUpdateEntry() || IsChunkedEntry(v) || IsFencedEntry(v)) {
 			allUpdate = false
 		}
 		if allNoOP && !v.IsNoOPSession() {
@@ -874,7 +968,7 @@ func getEntryTypes(entries []pb.Entry) (bool, bool) {
 	return allUpdate, allNoOP
 }
 
-func (s *StateMachine) handle(t []Task, a []sm.Entry) error {
+func (s *StateMachine) handle(t []Task) error {
 	batch := batchedEntryApply && s.Concurrent()
 	for idx := range t {
 		if t[idx].IsSnapshotTask() || t[idx].isSyncTask() {
@@ -887,9 +981,13 @@ func (s *StateMachine) handle(t []Task, a []sm.Entry) error {
 			defer s.mu.Unlock()
 			entries = pb.EntriesToApply(t[idx].Entries, s.index, false)
 		}()
+		if len(entries) > 0 {
+			s.applying.first = entries[0].Index
+			s.applying.last = entries[len(entries)-1].Index
+		}
 		update, noop := getEntryTypes(entries)
 		if batch && update && noop {
-			if err := s.handleBatch(entries, a); err != nil {
+			if err := s.handleBatch(entries); err != nil {
 				return err
 			}
 		} else {
@@ -901,6 +999,9 @@ func (s *StateMachine) handle(t []Task, a []sm.Entry) error {
 			}
 		}
 		s.setLastApplied(entries)
+		if len(entries) > 0 {
+			s.node.EntriesApplied(entries)
+		}
 	}
 	return nil
 }
@@ -939,17 +1040,25 @@ func (s *StateMachine) handleEntry(e pb.Entry, last bool) error {
 	if !e.IsSessionManaged() {
 		if e.IsEmpty() {
 			s.noop(e)
-			s.node.ApplyUpdate(e, sm.Result{}, false, true, last)
+			// barrier entries are proposed with keys, other empty entries are
+			// appended by Raft itself
+			s.node.ApplyUpdate(e, sm.Result{}, false, e.Key == 0, last)
 		} else {
 			panic("not session managed, not empty")
 		}
 	} else {
 		if e.IsNewSessionRequest() {
 			r := s.registerSession(e)
-			s.node.ApplyUpdate(e, r, isEmptyResult(r), false, last)
+			rejected := isEmptyResult(r) || IsSessionCapacityResult(r)
+			s.node.ApplyUpdate(e, r, rejected, false, last)
 		} else if e.IsEndOfSessionRequest() {
 			r := s.unregisterSession(e)
 			s.node.ApplyUpdate(e, r, isEmptyResult(r), false, last)
+		} else if isChunkPart(e) {
+			if err := s.addChunk(e); err != nil {
+				return err
+			}
+			s.node.ApplyUpdate(e, sm.Result{}, false, false, last)
 		} else {
 			if !s.entryInInitDiskSM(e.Index) {
 				r, ignored, rejected, err := s.update(e)
@@ -960,6 +1069,9 @@ func (s *StateMachine) handleEntry(e pb.Entry, last bool) error {
 					s.node.ApplyUpdate(e, r, rejected, ignored, last)
 				}
 			} else {
+				if IsChunkedEntry(e) {
+					s.takeChunks(e)
+				}
 				// treat it as a NoOP entry
 				s.noop(pb.Entry{Index: e.Index, Term: e.Term})
 			}
@@ -975,25 +1087,32 @@ func (s *StateMachine) onApplied(e pb.Entry,
 	}
 }
 
-func (s *StateMachine) handleBatch(input []pb.Entry, ents []sm.Entry) error {
-	if len(ents) != 0 {
-		panic("ents is not empty")
-	}
+func (s *StateMachine) handleBatch(input []pb.Entry) error {
+	pooled := getEntrySlice(len(input))
+	defer putEntrySlice(pooled)
+	ents := *pooled
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.resetPayloads()
 	skipped := 0
 	for _, e := range input {
 		if !s.entryInInitDiskSM(e.Index) {
-			payload, err := GetPayload(e)
+			payload, err := s.getPayload(e)
 			if err != nil {
 				return err
 			}
-			ents = append(ents, sm.Entry{Index: e.Index, Cmd: payload})
+			ents = append(ents, sm.Entry{
+				Index:     e.Index,
+				Cmd:       payload,
+				RequestID: e.RequestID,
+			})
 		} else {
 			skipped++
 			s.setApplied(e.Index, e.Term)
 		}
 	}
+	// entries are cleared when the slice is returned to the pool
+	*pooled = ents
 	if len(ents) > 0 {
 		results, err := s.sm.BatchedUpdate(ents)
 		if err != nil {
@@ -1015,26 +1134,54 @@ func (s *StateMachine) handleBatch(input []pb.Entry, ents []sm.Entry) error {
 	return nil
 }
 
+// getPayload returns the payload of the entry, compressed payloads are decoded
+// into the reused payload buffer when it is available.
+func (s *StateMachine) getPayload(e pb.Entry) ([]byte, error) {
+	if s.payloads == nil {
+		return GetPayload(e)
+	}
+	return s.payloads.getPayload(e)
+}
+
+func (s *StateMachine) resetPayloads() {
+	if s.payloads != nil {
+		s.payloads.reset()
+	}
+}
+
 func (s *StateMachine) configChange(e pb.Entry) error {
 	var cc pb.ConfigChange
 	pb.MustUnmarshal(&cc, e.Cmd)
 	rejected := true
+	var reason error
 	func() {
 		s.mu.Lock()
 		defer s.mu.Unlock()
 		defer s.setApplied(e.Index, e.Term)
+		if cc.Type == pb.LeaveJoint {
+			// LeaveJoint is proposed by the raft leader with no member info, the
+			// node is told which regular nodes are removed by leaving the joint
+			// configuration
+			cc.Members = s.members.getLeaving()
+		}
 		if s.members.handleConfigChange(cc, e.Index) {
+			s.members.record(cc, e.Index, e.Term)
 			rejected = false
+		} else {
+			reason = s.members.getRejectionReason(cc)
 		}
 	}()
-	return s.node.ApplyConfigChange(cc, e.Key, rejected)
+	if err := failpoint.Inject(failpoint.AfterConfigChangeApply); err != nil {
+		return err
+	}
+	return s.node.ApplyConfigChange(cc, e.Key, rejected, reason)
 }
 
 func (s *StateMachine) registerSession(e pb.Entry) sm.Result {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	defer s.setApplied(e.Index, e.Term)
-	return s.sessions.RegisterClientID(e.ClientID)
+	return s.sessions.RegisterClientID(e.ClientID, e.Index)
 }
 
 func (s *StateMachine) unregisterSession(e pb.Entry) sm.Result {
@@ -1044,6 +1191,22 @@ func (s *StateMachine) unregisterSession(e pb.Entry) sm.Result {
 	return s.sessions.UnregisterClientID(e.ClientID)
 }
 
+// addChunk adds the chunk of a chunked proposal, chunks are always recorded as
+// the manifest can be applied after the on disk state machine's initial index.
+func (s *StateMachine) addChunk(e pb.Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.setApplied(e.Index, e.Term)
+	return s.sessions.addChunk(e)
+}
+
+// takeChunks discards the chunked proposal of the specified manifest entry.
+func (s *StateMachine) takeChunks(e pb.Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions.takeChunks(e)
+}
+
 func (s *StateMachine) noop(e pb.Entry) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -1058,46 +1221,61 @@ func (s *StateMachine) update(e pb.Entry) (sm.Result, bool, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	defer s.setApplied(e.Index, e.Term)
-	var ok bool
+	var chunked []byte
+	chunksReady := false
+	if IsChunkedEntry(e) {
+		// the chunked proposal is discarded whatever the outcome
+		chunked, chunksReady = s.sessions.takeChunks(e)
+	}
 	var session *Session
 	if !e.IsNoOPSession() {
-		session, ok = s.sessions.ClientRegistered(e.ClientID)
-		if !ok {
+		var v sm.Result
+		var status proposalStatus
+		session, v, status = s.sessions.checkProposal(e.ClientID,
+			e.SeriesID, e.RespondedTo, e.Index)
+		switch status {
+		case proposalRejected:
 			// client is expected to crash
 			return sm.Result{}, false, true, nil
-		}
-		s.sessions.UpdateRespondedTo(session, e.RespondedTo)
-		v, responded, toUpdate := s.sessions.UpdateRequired(session, e.SeriesID)
-		if responded {
+		case proposalIgnored:
 			// should ignore. client is expected to timeout
 			return sm.Result{}, true, false, nil
-		}
-		if !toUpdate {
+		case proposalResponded:
 			// server responded, client never confirmed
 			// return the result again but not update the sm again
 			// this implements the no-more-than-once update of the SM
 			return v, false, false, nil
 		}
 	}
-	if !e.IsNoOPSession() && session == nil {
-		panic("session not found")
-	}
-	if session != nil {
-		if _, ok := session.getResponse(RaftSeriesID(e.SeriesID)); ok {
-			panic("already has response in session")
+	var payload []byte
+	if IsChunkedEntry(e) {
+		if !chunksReady {
+			// rejected without updating the session, the client can retry
+			plog.Warningf("%s chunked proposal at %d is incomplete", s.id(), e.Index)
+			return IncompleteChunksResult(), false, true, nil
+		}
+		payload = chunked
+	} else if IsFencedEntry(e) && fenceExpired(e) {
+		// rejected without updating the session, the client can retry
+		return FenceExpiredResult(), false, true, nil
+	} else {
+		s.resetPayloads()
+		var err error
+		if payload, err = s.getPayload(e); err != nil {
+			return sm.Result{}, false, false, err
 		}
 	}
-	payload, err := GetPayload(e)
-	if err != nil {
-		return sm.Result{}, false, false, err
-	}
-	r, err := s.sm.Update(sm.Entry{Index: e.Index, Cmd: payload})
+	r, err := s.sm.Update(sm.Entry{
+		Index:     e.Index,
+		Cmd:       payload,
+		RequestID: e.RequestID,
+	})
 	if err != nil {
 		return sm.Result{}, false, false, err
 	}
 	s.setOnDiskIndex(e.Index, e.Index)
 	if session != nil {
-		session.addResponse(RaftSeriesID(e.SeriesID), r)
+		s.sessions.AddResponse(session, e.SeriesID, r)
 	}
 	return r, false, false, nil
 }
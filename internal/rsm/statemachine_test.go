@@ -19,6 +19,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"reflect"
 	"testing"
 
 	"github.com/cockroachdb/errors"
@@ -59,6 +60,7 @@ type testNodeProxy struct {
 	addPeer            bool
 	removePeer         bool
 	reject             bool
+	rejectReason       error
 	accept             bool
 	smResult           sm.Result
 	index              uint64
@@ -72,6 +74,7 @@ type testNodeProxy struct {
 	nodeReady          uint64
 	applyUpdateCalled  bool
 	firstIndex         uint64
+	applied            []pb.Entry
 }
 
 func newTestNodeProxy() *testNodeProxy {
@@ -109,7 +112,8 @@ func (p *testNodeProxy) RestoreRemotes(s pb.Snapshot) error {
 	return nil
 }
 
-func (p *testNodeProxy) ApplyConfigChange(cc pb.ConfigChange, key uint64, rejected bool) error {
+func (p *testNodeProxy) ApplyConfigChange(cc pb.ConfigChange,
+	key uint64, rejected bool, reason error) error {
 	if !rejected {
 		p.applyConfChange = true
 		if cc.Type == pb.AddNode {
@@ -121,6 +125,8 @@ func (p *testNodeProxy) ApplyConfigChange(cc pb.ConfigChange, key uint64, reject
 		} else if cc.Type == pb.RemoveNode {
 			p.removePeer = true
 		}
+	} else {
+		p.rejectReason = reason
 	}
 	p.configChangeProcessed(key, rejected)
 	return nil
@@ -134,6 +140,10 @@ func (p *testNodeProxy) configChangeProcessed(index uint64, rejected bool) {
 	}
 }
 
+func (p *testNodeProxy) EntriesApplied(entries []pb.Entry) {
+	p.applied = append(p.applied, entries...)
+}
+
 func (p *testNodeProxy) ReplicaID() uint64 { return 1 }
 func (p *testNodeProxy) ShardID() uint64   { return 1 }
 
@@ -144,9 +154,10 @@ func (noopCompactor) Compact(uint64) error { return nil }
 var testCompactor = &noopCompactor{}
 
 type testSnapshotter struct {
-	index    uint64
-	dataSize uint64
-	fs       vfs.IFS
+	index      uint64
+	dataSize   uint64
+	fs         vfs.IFS
+	membership *pb.Membership
 }
 
 func newTestSnapshotter(fs vfs.IFS) *testSnapshotter {
@@ -168,6 +179,9 @@ func (s *testSnapshotter) GetSnapshot() (pb.Snapshot, error) {
 			Addresses: address,
 		},
 	}
+	if s.membership != nil {
+		ss.Membership = *s.membership
+	}
 	ss.Load(testCompactor)
 	return ss, nil
 }
@@ -347,7 +361,7 @@ func TestUpdatesCanBeBatched(t *testing.T) {
 	sm.taskQ.Add(commit)
 	// two commits to handle
 	batch := make([]Task, 0, 8)
-	if _, err := sm.Handle(batch, nil); err != nil {
+	if _, err := sm.Handle(batch); err != nil {
 		t.Fatalf("handle failed %v", err)
 	}
 	if sm.GetLastApplied() != 237 {
@@ -357,6 +371,15 @@ func TestUpdatesCanBeBatched(t *testing.T) {
 	if count != 3 {
 		t.Fatalf("not batched as expected, batched update count %d, want 3", count)
 	}
+	// entries already applied are not reported again
+	sm.taskQ.Add(commit)
+	if _, err := sm.Handle(batch); err != nil {
+		t.Fatalf("handle failed %v", err)
+	}
+	if len(nodeProxy.applied) != 3 || nodeProxy.applied[0].Index != 235 ||
+		nodeProxy.applied[2].Index != 237 {
+		t.Errorf("unexpected applied entries %v", nodeProxy.applied)
+	}
 	reportLeakedFD(fs, t)
 }
 
@@ -391,7 +414,7 @@ func TestMetadataEntryCanBeHandled(t *testing.T) {
 	sm.taskQ.Add(commit)
 	// two commits to handle
 	batch := make([]Task, 0, 8)
-	if _, err := sm.Handle(batch, nil); err != nil {
+	if _, err := sm.Handle(batch); err != nil {
 		t.Fatalf("handle failed %v", err)
 	}
 	if sm.GetLastApplied() != 237 {
@@ -437,8 +460,7 @@ func testHandleBatchedSnappyEncodedEntry(t *testing.T,
 	tsm.lastApplied.index = 235
 	tsm.index = 235
 	entries := []pb.Entry{e1, e2}
-	batch := make([]sm.Entry, 0, 8)
-	if err := tsm.handleBatch(entries, batch); err != nil {
+	if err := tsm.handleBatch(entries); err != nil {
 		t.Fatalf("handle failed %v", err)
 	}
 	v, err := store.Lookup([]byte("test-key"))
@@ -491,7 +513,7 @@ func TestHandleAllocationCount(t *testing.T) {
 			Entries: entries,
 		}
 		sm.taskQ.Add(commit)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != idx {
@@ -503,6 +525,57 @@ func TestHandleAllocationCount(t *testing.T) {
 	}
 }
 
+func getSnappyEncodedApplyAllocationCount(t *testing.T,
+	store sm.IConcurrentStateMachine) float64 {
+	fs := vfs.GetTestFS()
+	config := config.Config{ShardID: 1, ReplicaID: 1}
+	ds := NewNativeSM(config, NewConcurrentStateMachine(store), make(chan struct{}))
+	sm := NewStateMachine(ds, nil, config, newTestNodeProxy(), fs)
+	sm.lastApplied.index = 1
+	sm.index = 1
+	idx := uint64(1)
+	batch := make([]Task, 0, 8)
+	entries := make([]pb.Entry, 128)
+	cmd := GetEncoded(dio.Snappy, make([]byte, 1024), nil)
+	return testing.AllocsPerRun(100, func() {
+		for i := range entries {
+			idx++
+			entries[i] = pb.Entry{
+				Type:     pb.EncodedEntry,
+				ClientID: 123,
+				SeriesID: client.NoOPSeriesID,
+				Index:    idx,
+				Term:     1,
+				Cmd:      cmd,
+			}
+		}
+		sm.taskQ.Add(Task{Entries: entries})
+		if _, err := sm.Handle(batch); err != nil {
+			t.Fatalf("handle failed %v", err)
+		}
+		if sm.GetLastApplied() != idx {
+			t.Errorf("last applied %d, want %d", sm.GetLastApplied(), idx)
+		}
+	})
+}
+
+func TestNonRetainingStateMachineReducesAllocations(t *testing.T) {
+	store := &tests.ConcurrentNoOP{}
+	nrStore := &tests.NonRetainingConcurrentNoOP{}
+	ac := getSnappyEncodedApplyAllocationCount(t, store)
+	nrac := getSnappyEncodedApplyAllocationCount(t, nrStore)
+	if store.UpdateCount == 0 || store.UpdateCount != nrStore.UpdateCount {
+		t.Fatalf("unexpected update count %d, %d",
+			store.UpdateCount, nrStore.UpdateCount)
+	}
+	if ac < 128 {
+		t.Errorf("retaining state machine ac %f, want >= 128", ac)
+	}
+	if nrac*2 > ac {
+		t.Errorf("non-retaining state machine ac %f, retaining ac %f", nrac, ac)
+	}
+}
+
 func TestUpdatesNotBatchedWhenNotAllNoOPUpdates(t *testing.T) {
 	fs := vfs.GetTestFS()
 	defer leaktest.AfterTest(t)()
@@ -540,7 +613,7 @@ func TestUpdatesNotBatchedWhenNotAllNoOPUpdates(t *testing.T) {
 	sm.taskQ.Add(commit)
 	// two commits to handle
 	batch := make([]Task, 0, 8)
-	if _, err := sm.Handle(batch, nil); err != nil {
+	if _, err := sm.Handle(batch); err != nil {
 		t.Fatalf("handle failed %v", err)
 	}
 	if sm.GetLastApplied() != 237 {
@@ -549,6 +622,46 @@ func TestUpdatesNotBatchedWhenNotAllNoOPUpdates(t *testing.T) {
 	reportLeakedFD(fs, t)
 }
 
+func TestRegistrationRejectedBySessionTTL(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	createTestDir(fs)
+	defer removeTestDir(fs)
+	store := &tests.ConcurrentUpdate{}
+	config := config.Config{ShardID: 1, ReplicaID: 1, SessionTTLEntries: 1}
+	ds := NewNativeSM(config, &ConcurrentStateMachine{sm: store}, make(chan struct{}))
+	nodeProxy := newTestNodeProxy()
+	snapshotter := newTestSnapshotter(fs)
+	sm := NewStateMachine(ds, snapshotter, config, nodeProxy, fs)
+	if sm.sessions.ttl != 1 {
+		t.Fatalf("ttl %d, want 1", sm.sessions.ttl)
+	}
+	sm.sessions.lru = newLRUSession(1)
+	register := func(clientID uint64, index uint64) {
+		e := pb.Entry{
+			ClientID: clientID,
+			SeriesID: client.SeriesIDForRegister,
+			Index:    index,
+			Term:     1,
+		}
+		if err := sm.handleEntry(e, true); err != nil {
+			t.Fatalf("handle entry failed %v", err)
+		}
+	}
+	register(123, 1)
+	if nodeProxy.rejected || nodeProxy.smResult.Value != 123 {
+		t.Errorf("registration rejected")
+	}
+	register(234, 2)
+	if !nodeProxy.rejected || !IsSessionCapacityResult(nodeProxy.smResult) {
+		t.Errorf("registration not rejected, %v", nodeProxy.smResult)
+	}
+	register(234, 3)
+	if nodeProxy.rejected || nodeProxy.smResult.Value != 234 {
+		t.Errorf("registration rejected")
+	}
+}
+
 func TestStateMachineCanBeCreated(t *testing.T) {
 	tf := func(t *testing.T, sm *StateMachine) {
 		if sm.TaskChanBusy() {
@@ -747,7 +860,7 @@ func TestHandleConfChangeAddNode(t *testing.T) {
 		nodeProxy *testNodeProxy, snapshotter *testSnapshotter, store sm.IStateMachine) {
 		applyConfigChangeEntry(sm, 1, pb.AddNode, 4, "localhost:1010", 123)
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != 123 {
@@ -781,7 +894,7 @@ func TestAddNodeAsNonVotingWillBeRejected(t *testing.T) {
 			"localhost:1010",
 			123)
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("Handle failed %v", err)
 		}
 		if sm.GetLastApplied() != 123 {
@@ -793,7 +906,7 @@ func TestAddNodeAsNonVotingWillBeRejected(t *testing.T) {
 			4,
 			"localhost:1010",
 			124)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if !nodeProxy.reject {
@@ -815,7 +928,7 @@ func TestNonVotingCanBeAdded(t *testing.T) {
 			123)
 
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != 123 {
@@ -846,7 +959,7 @@ func TestNonVotingPromotion(t *testing.T) {
 			123)
 
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != 123 {
@@ -868,7 +981,7 @@ func TestNonVotingPromotion(t *testing.T) {
 			"localhost:1010",
 			124)
 
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != 124 {
@@ -899,7 +1012,7 @@ func TestInvalidNonVotingPromotionIsRejected(t *testing.T) {
 			123)
 
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != 123 {
@@ -922,7 +1035,7 @@ func TestInvalidNonVotingPromotionIsRejected(t *testing.T) {
 			"localhost:1011",
 			124)
 
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		_, ok := sm.members.members.Addresses[4]
@@ -949,7 +1062,7 @@ func testAddExistingMemberIsRejected(t *testing.T, tt pb.ConfigChangeType, fs vf
 			123)
 
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != 123 {
@@ -990,7 +1103,7 @@ func testAddExistingMemberWithSameReplicaIDIsRejected(t *testing.T,
 			123)
 
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != 123 {
@@ -1029,7 +1142,7 @@ func TestHandleConfChangeRemoveNode(t *testing.T) {
 			t.Errorf("node 1 not in members")
 		}
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != 123 {
@@ -1065,7 +1178,7 @@ func TestOrderedConfChangeIsAccepted(t *testing.T) {
 			"",
 			123)
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if nodeProxy.reject {
@@ -1100,7 +1213,7 @@ func TestRemoveOnlyNodeIsRejected(t *testing.T) {
 			t.Errorf("node 1 not in members")
 		}
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != 123 {
@@ -1137,7 +1250,7 @@ func TestAddingNodeOnTheSameNodeHostWillBeRejected(t *testing.T) {
 			"test.nodehost",
 			123)
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if !nodeProxy.reject {
@@ -1166,12 +1279,15 @@ func TestAddingRemovedNodeWillBeRejected(t *testing.T) {
 			"a1",
 			123)
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if !nodeProxy.reject {
 			t.Errorf("not rejected")
 		}
+		if !errors.Is(nodeProxy.rejectReason, ErrReplicaIDReused) {
+			t.Errorf("unexpected reason %v", nodeProxy.rejectReason)
+		}
 		if nodeProxy.addPeer {
 			t.Errorf("add peer unexpectedly called")
 		}
@@ -1180,6 +1296,46 @@ func TestAddingRemovedNodeWillBeRejected(t *testing.T) {
 	runSMTest2(t, tf, fs)
 }
 
+func TestRemovedNodeCanBeAddedWhenReuseIsAllowed(t *testing.T) {
+	tf := func(t *testing.T, sm *StateMachine, ds IManagedStateMachine,
+		nodeProxy *testNodeProxy, snapshotter *testSnapshotter, store sm.IStateMachine) {
+		sm.members.members.ConfigChangeId = 6
+		sm.members.members.Removed[2] = true
+		cc := pb.ConfigChange{
+			Type:       pb.AddNode,
+			ReplicaID:  2,
+			Address:    "a2",
+			AllowReuse: true,
+			// set by the leader when all members support AllowReuse
+			ProtocolVersion: pb.ProtocolVersion,
+		}
+		e := pb.Entry{
+			Cmd:   pb.MustMarshal(&cc),
+			Type:  pb.ConfigChangeEntry,
+			Index: 123,
+			Term:  1,
+		}
+		sm.lastApplied.index = 122
+		sm.index = 122
+		sm.taskQ.Add(Task{Entries: []pb.Entry{e}})
+		batch := make([]Task, 0, 8)
+		if _, err := sm.Handle(batch); err != nil {
+			t.Fatalf("handle failed %v", err)
+		}
+		if nodeProxy.reject {
+			t.Errorf("unexpectedly rejected")
+		}
+		if !nodeProxy.addPeer {
+			t.Errorf("add peer not called")
+		}
+		if _, ok := sm.members.members.Removed[2]; ok {
+			t.Errorf("removed record not cleared")
+		}
+	}
+	fs := vfs.GetTestFS()
+	runSMTest2(t, tf, fs)
+}
+
 func TestOutOfOrderConfChangeIsRejected(t *testing.T) {
 	tf := func(t *testing.T, sm *StateMachine, ds IManagedStateMachine,
 		nodeProxy *testNodeProxy, snapshotter *testSnapshotter, store sm.IStateMachine) {
@@ -1192,7 +1348,7 @@ func TestOutOfOrderConfChangeIsRejected(t *testing.T) {
 			"",
 			123)
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if !nodeProxy.reject {
@@ -1218,7 +1374,7 @@ func TestHandleSyncTask(t *testing.T) {
 		tsm.lastApplied.index = 100
 		tsm.taskQ.Add(task1)
 		tsm.taskQ.Add(task2)
-		if _, err := tsm.Handle(make([]Task, 0), make([]sm.Entry, 0)); err != nil {
+		if _, err := tsm.Handle(make([]Task, 0)); err != nil {
 			t.Fatalf("%v", err)
 		}
 		if tsm.lastApplied.index != 100 {
@@ -1244,7 +1400,7 @@ func TestHandleEmptyEvent(t *testing.T) {
 		sm.index = 233
 		sm.taskQ.Add(commit)
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != 234 {
@@ -1296,7 +1452,7 @@ func testHandleSnappyEncodedEntry(t *testing.T, ct dio.CompressionType, fs vfs.I
 		sm.taskQ.Add(commit)
 		// two commits to handle
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != 236 {
@@ -1344,7 +1500,7 @@ func TestHandleUpate(t *testing.T) {
 		sm.taskQ.Add(commit)
 		// two commits to handle
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != 236 {
@@ -1455,18 +1611,59 @@ func TestMembersAreSavedWhenMakingSnapshot(t *testing.T) {
 	runSMTest2(t, tf, fs)
 }
 
+func TestMaxSizeMembershipCanBeSavedAndRecovered(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, sm *StateMachine, ds IManagedStateMachine,
+		nodeProxy *testNodeProxy, snapshotter *testSnapshotter, store sm.IStateMachine) {
+		m := getMaxSizeMembership()
+		sm.members.set(m)
+		sm.lastApplied.index = 3
+		sm.index = 3
+		ss, _, err := sm.Save(SSRequest{})
+		if err != nil {
+			t.Fatalf("failed to make snapshot %v", err)
+		}
+		if !reflect.DeepEqual(ss.Membership, m) {
+			t.Fatalf("membership not saved")
+		}
+		// the snapshot record is persisted in the LogDB
+		var record pb.Snapshot
+		if err := record.Unmarshal(pb.MustMarshal(&ss)); err != nil {
+			t.Fatalf("failed to unmarshal %v", err)
+		}
+		store2 := tests.NewKVTest(1, 1)
+		config := config.Config{ShardID: 1, ReplicaID: 1}
+		store2.(*tests.KVTest).DisableLargeDelay()
+		ds2 := NewNativeSM(config, NewInMemStateMachine(store2), make(chan struct{}))
+		snapshotter2 := newTestSnapshotter(fs)
+		snapshotter2.index = ss.Index
+		snapshotter2.membership = &record.Membership
+		sm2 := NewStateMachine(ds2, snapshotter2, config, newTestNodeProxy(), fs)
+		if _, err := sm2.Recover(Task{Index: ss.Index}); err != nil {
+			t.Fatalf("failed to recover %v", err)
+		}
+		if !reflect.DeepEqual(sm2.members.get(), m) {
+			t.Errorf("membership not recovered")
+		}
+		if sm2.GetMembershipHash() != sm.GetMembershipHash() {
+			t.Errorf("membership hash changed")
+		}
+	}
+	runSMTest2(t, tf, fs)
+}
+
 func TestSnapshotTwiceIsHandled(t *testing.T) {
 	tf := func(t *testing.T, sm *StateMachine, ds IManagedStateMachine,
 		nodeProxy *testNodeProxy, snapshotter *testSnapshotter, store sm.IStateMachine) {
 		sm.members.members.Addresses[1] = "localhost:1"
 		sm.members.members.Addresses[2] = "localhost:2"
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		data := getTestKVData()
 		e := applyTestEntry(sm, 12345, client.NoOPSeriesID, 1, 0, data)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != e.Index {
@@ -1542,7 +1739,7 @@ func TestSessionCanBeCreatedAndRemoved(t *testing.T) {
 		clientID := uint64(12345)
 		applySessionRegisterEntry(sm, clientID, 789)
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != 789 {
@@ -1559,7 +1756,7 @@ func TestSessionCanBeCreatedAndRemoved(t *testing.T) {
 		index := uint64(790)
 		applySessionUnregisterEntry(sm, 12345, index)
 
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != index {
@@ -1571,7 +1768,7 @@ func TestSessionCanBeCreatedAndRemoved(t *testing.T) {
 			t.Errorf("session not removed")
 		}
 		if nodeProxy.smResult.Value != clientID {
-			t.Errorf("smResult %d, want %d", nodeProxy.smResult, clientID)
+			t.Errorf("smResult %d, want %d", nodeProxy.smResult.Value, clientID)
 		}
 	}
 	fs := vfs.GetTestFS()
@@ -1583,7 +1780,7 @@ func TestDuplicatedSessionWillBeReported(t *testing.T) {
 		nodeProxy *testNodeProxy, snapshotter *testSnapshotter, store sm.IStateMachine) {
 		e := applySessionRegisterEntry(sm, 12345, 789)
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != e.Index {
@@ -1606,7 +1803,7 @@ func TestDuplicatedSessionWillBeReported(t *testing.T) {
 		if nodeProxy.rejected {
 			t.Errorf("rejected flag set too early")
 		}
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != e.Index {
@@ -1614,7 +1811,7 @@ func TestDuplicatedSessionWillBeReported(t *testing.T) {
 				sm.GetLastApplied(), e.Index)
 		}
 		if nodeProxy.smResult.Value != 0 {
-			t.Errorf("smResult %d, want %d", nodeProxy.smResult, 0)
+			t.Errorf("smResult %d, want %d", nodeProxy.smResult.Value, 0)
 		}
 		if !nodeProxy.rejected {
 			t.Errorf("reject flag not set")
@@ -1631,7 +1828,7 @@ func TestRemovingUnregisteredSessionWillBeReported(t *testing.T) {
 		sm.index = 789
 		e := applySessionUnregisterEntry(sm, 12345, 790)
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != e.Index {
@@ -1644,7 +1841,7 @@ func TestRemovingUnregisteredSessionWillBeReported(t *testing.T) {
 			t.Errorf("session not suppose to be there")
 		}
 		if nodeProxy.smResult.Value != 0 {
-			t.Errorf("smResult %d, want %d", nodeProxy.smResult, 0)
+			t.Errorf("smResult %d, want %d", nodeProxy.smResult.Value, 0)
 		}
 		if !nodeProxy.rejected {
 			t.Errorf("reject flag not set")
@@ -1662,7 +1859,7 @@ func TestUpdateFromUnregisteredClientWillBeReported(t *testing.T) {
 		sm.lastApplied.index = 789
 		sm.index = 789
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != e.Index {
@@ -1675,7 +1872,7 @@ func TestUpdateFromUnregisteredClientWillBeReported(t *testing.T) {
 			t.Errorf("ignored %t, want false", nodeProxy.ignored)
 		}
 		if nodeProxy.smResult.Value != 0 {
-			t.Errorf("smResult %d, want 0", nodeProxy.smResult)
+			t.Errorf("smResult %d, want 0", nodeProxy.smResult.Value)
 		}
 		if !nodeProxy.rejected {
 			t.Errorf("rejected %t, want true", nodeProxy.rejected)
@@ -1690,13 +1887,13 @@ func TestDuplicatedUpdateWillNotBeAppliedTwice(t *testing.T) {
 		nodeProxy *testNodeProxy, snapshotter *testSnapshotter, store sm.IStateMachine) {
 		applySessionRegisterEntry(sm, 12345, 789)
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		data := getTestKVData()
 		e := applyTestEntry(sm, 12345, 1, 790, 0, data)
 		// check normal update is accepted and handled
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		plog.Infof("Handle returned")
@@ -1708,7 +1905,7 @@ func TestDuplicatedUpdateWillNotBeAppliedTwice(t *testing.T) {
 			t.Errorf("update not invoked")
 		}
 		if nodeProxy.smResult.Value != uint64(len(data)) {
-			t.Errorf("smResult %d, want %d", nodeProxy.smResult, len(data))
+			t.Errorf("smResult %d, want %d", nodeProxy.smResult.Value, len(data))
 		}
 		nodeProxy.applyUpdateInvoked = false
 		storeCount := store.(*tests.KVTest).Count
@@ -1718,7 +1915,7 @@ func TestDuplicatedUpdateWillNotBeAppliedTwice(t *testing.T) {
 		}
 		e = applyTestEntry(sm, 12345, 1, 791, 0, data)
 		plog.Infof("going to handle the second commit rec")
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != e.Index {
@@ -1741,13 +1938,13 @@ func TestRespondedUpdateWillNotBeAppliedTwice(t *testing.T) {
 		nodeProxy *testNodeProxy, snapshotter *testSnapshotter, store sm.IStateMachine) {
 		applySessionRegisterEntry(sm, 12345, 789)
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		data := getTestKVData()
 		e := applyTestEntry(sm, 12345, 1, 790, 0, data)
 		// check normal update is accepted and handleped
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != e.Index {
@@ -1757,7 +1954,7 @@ func TestRespondedUpdateWillNotBeAppliedTwice(t *testing.T) {
 		storeCount := store.(*tests.KVTest).Count
 		// update the respondedto value
 		e = applyTestEntry(sm, 12345, 1, 791, 1, data)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		sessionManager := sm.sessions.lru
@@ -1768,7 +1965,7 @@ func TestRespondedUpdateWillNotBeAppliedTwice(t *testing.T) {
 		nodeProxy.applyUpdateInvoked = false
 		// submit the same stuff again with a different index value
 		e = applyTestEntry(sm, 12345, 1, 792, 1, data)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != e.Index {
@@ -1791,13 +1988,13 @@ func TestNoOPSessionAllowEntryToBeAppliedTwice(t *testing.T) {
 		nodeProxy *testNodeProxy, snapshotter *testSnapshotter, store sm.IStateMachine) {
 		applySessionRegisterEntry(sm, 12345, 789)
 		batch := make([]Task, 0, 8)
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		data := getTestKVData()
 		e := applyTestEntry(sm, 12345, client.NoOPSeriesID, 790, 0, data)
 		// check normal update is accepted and handleped
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != e.Index {
@@ -1808,7 +2005,7 @@ func TestNoOPSessionAllowEntryToBeAppliedTwice(t *testing.T) {
 		// different index as the same entry is proposed again
 		e = applyTestEntry(sm, 12345, client.NoOPSeriesID, 791, 0, data)
 		// check normal update is accepted and handleped
-		if _, err := sm.Handle(batch, nil); err != nil {
+		if _, err := sm.Handle(batch); err != nil {
 			t.Fatalf("handle failed %v", err)
 		}
 		if sm.GetLastApplied() != e.Index {
@@ -2170,6 +2367,10 @@ func (t *testManagedStateMachine) Sync() error {
 	return nil
 }
 func (t *testManagedStateMachine) GetHash() (uint64, error) { return 0, nil }
+func (t *testManagedStateMachine) Fingerprint() (uint64, error) {
+	return 0, sm.ErrNotImplemented
+}
+func (t *testManagedStateMachine) NonRetaining() bool { return false }
 func (t *testManagedStateMachine) Prepare() (interface{}, error) {
 	t.prepareInvoked = true
 	return nil, nil
@@ -2307,7 +2508,6 @@ func TestHandleBatchedEntriesForOnDiskSM(t *testing.T) {
 		for i := tt.first; i <= tt.last; i++ {
 			input = append(input, pb.Entry{Index: i, Term: 100})
 		}
-		ents := make([]sm.Entry, 0)
 		msm := &testManagedStateMachine{}
 		np := newTestNodeProxy()
 		sm := &StateMachine{
@@ -2319,7 +2519,7 @@ func TestHandleBatchedEntriesForOnDiskSM(t *testing.T) {
 		}
 		sm.lastApplied.index = tt.index
 		sm.lastApplied.term = 100
-		if err := sm.handleBatch(input, ents); err != nil {
+		if err := sm.handleBatch(input); err != nil {
 			t.Fatalf("handle batched entries failed %v", err)
 		}
 		if msm.first != tt.firstApplied {
@@ -2341,7 +2541,6 @@ func TestHandleBatchedEntriesForOnDiskSM(t *testing.T) {
 }
 
 func TestCorruptedIndexValueWillBeDetected(t *testing.T) {
-	ents := make([]sm.Entry, 0)
 	msm := &testManagedStateMachine{corruptIndex: true}
 	np := newTestNodeProxy()
 	sm := &StateMachine{
@@ -2361,13 +2560,12 @@ func TestCorruptedIndexValueWillBeDetected(t *testing.T) {
 			t.Fatalf("failed to trigger panic")
 		}
 	}()
-	if err := sm.handleBatch(input, ents); err != nil {
+	if err := sm.handleBatch(input); err != nil {
 		t.Fatalf("handle batched entries failed %v", err)
 	}
 }
 
 func TestNodeReadyIsSetWhenAnythingFromTaskQIsProcessed(t *testing.T) {
-	ents := make([]sm.Entry, 0)
 	batch := make([]Task, 0)
 	msm := &testManagedStateMachine{}
 	np := newTestNodeProxy()
@@ -2378,7 +2576,7 @@ func TestNodeReadyIsSetWhenAnythingFromTaskQIsProcessed(t *testing.T) {
 		taskQ:           NewTaskQueue(),
 		node:            np,
 	}
-	rec, err := sm.Handle(batch, ents)
+	rec, err := sm.Handle(batch)
 	if rec.IsSnapshotTask() {
 		t.Errorf("why snapshot?")
 	}
@@ -2389,7 +2587,7 @@ func TestNodeReadyIsSetWhenAnythingFromTaskQIsProcessed(t *testing.T) {
 		t.Errorf("nodeReady unexpectedly updated")
 	}
 	sm.taskQ.Add(Task{})
-	rec, err = sm.Handle(batch, ents)
+	rec, err = sm.Handle(batch)
 	if rec.IsSnapshotTask() {
 		t.Errorf("why snapshot?")
 	}
@@ -2661,7 +2859,7 @@ func TestUpdateErrorIsReturned(t *testing.T) {
 	sm.index = 234
 	sm.taskQ.Add(commit)
 	batch := make([]Task, 0, 8)
-	if _, err := sm.Handle(batch, nil); !expectedError(err) {
+	if _, err := sm.Handle(batch); !expectedError(err) {
 		t.Fatalf("failed to return the expected error, %v", err)
 	}
 }
@@ -2671,9 +2869,10 @@ type errorNodeProxy struct{}
 func (e *errorNodeProxy) StepReady()                                        {}
 func (e *errorNodeProxy) RestoreRemotes(pb.Snapshot) error                  { return errReturnedError }
 func (e *errorNodeProxy) ApplyUpdate(pb.Entry, sm.Result, bool, bool, bool) {}
-func (e *errorNodeProxy) ApplyConfigChange(pb.ConfigChange, uint64, bool) error {
+func (e *errorNodeProxy) ApplyConfigChange(pb.ConfigChange, uint64, bool, error) error {
 	return errReturnedError
 }
+func (e *errorNodeProxy) EntriesApplied([]pb.Entry)   {}
 func (e *errorNodeProxy) ReplicaID() uint64           { return 1 }
 func (e *errorNodeProxy) ShardID() uint64             { return 1 }
 func (e *errorNodeProxy) ShouldStop() <-chan struct{} { return make(chan struct{}) }
@@ -2714,7 +2913,7 @@ func TestConfigChangeErrorIsReturned(t *testing.T) {
 	sm.taskQ.Add(commit)
 	// two commits to handle
 	batch := make([]Task, 0, 8)
-	if _, err := sm.Handle(batch, nil); !expectedError(err) {
+	if _, err := sm.Handle(batch); !expectedError(err) {
 		t.Fatalf("failed to return the expected error, %v", err)
 	}
 }
@@ -0,0 +1,201 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/settings"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+var (
+	// ErrSnapshotFileMissing indicates that a file referenced by the snapshot
+	// can not be found.
+	ErrSnapshotFileMissing = errors.New("snapshot file missing")
+	// ErrSnapshotFileSize indicates that the size of a snapshot file is
+	// different from the size recorded in the snapshot metadata.
+	ErrSnapshotFileSize = errors.New("unexpected snapshot file size")
+	// ErrSnapshotChecksum indicates that a snapshot file failed the checksum
+	// check.
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+)
+
+// GetFileChecksum returns the checksum of the content of the specified file.
+func GetFileChecksum(fp string, fs vfs.IFS) (checksum []byte, err error) {
+	f, err := fs.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = firstError(err, f.Close())
+	}()
+	h := getDefaultChecksum()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// VerifySnapshotImage checks the snapshot image file fp. Its size is checked
+// against sz, its header and the payload length recorded in its tail are
+// validated. The payload checksum is compared with checksum when checksum is
+// not empty. When deep is true, all blocks of the file are re-hashed and
+// checked against their checksums.
+func VerifySnapshotImage(fp string,
+	sz uint64, checksum []byte, deep bool, fs vfs.IFS) (err error) {
+	if err := verifyFileSize(fp, sz, fs); err != nil {
+		return err
+	}
+	if sz < HeaderSize {
+		return errors.Wrapf(ErrSnapshotFileSize, "%s is too small", fp)
+	}
+	f, err := fs.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, f.Close())
+	}()
+	data := make([]byte, HeaderSize)
+	if err := readFull(f, data, 0); err != nil {
+		return err
+	}
+	h, crc, ok := getHeaderFromFirstChunk(data)
+	if !ok || !validateHeader(h, crc) {
+		return errors.Wrapf(ErrSnapshotChecksum, "%s has a corrupted header", fp)
+	}
+	var header pb.SnapshotHeader
+	if err := header.Unmarshal(h); err != nil {
+		return errors.Wrapf(ErrSnapshotChecksum, "%s has a corrupted header", fp)
+	}
+	if SSVersion(header.Version) == V2 {
+		if err := verifyV2Tail(f, fp, sz); err != nil {
+			return err
+		}
+	}
+	if deep {
+		if err := verifyBlocks(f, fp, sz); err != nil {
+			return err
+		}
+	}
+	if len(checksum) > 0 && SSVersion(header.Version) == V2 {
+		payload, err := GetV2PayloadChecksum(fp, fs)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(payload, checksum) {
+			return errors.Wrapf(ErrSnapshotChecksum,
+				"%s payload checksum mismatch", fp)
+		}
+	}
+	return nil
+}
+
+// VerifySnapshotFile checks the external snapshot file fp described by f. Its
+// size is checked against the recorded size, its content is re-hashed and
+// checked against the recorded checksum when deep is true.
+func VerifySnapshotFile(fp string,
+	f *pb.SnapshotFile, deep bool, fs vfs.IFS) error {
+	if err := verifyFileSize(fp, f.FileSize, fs); err != nil {
+		return err
+	}
+	if deep && len(f.Checksum) > 0 {
+		checksum, err := GetFileChecksum(fp, fs)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(checksum, f.Checksum) {
+			return errors.Wrapf(ErrSnapshotChecksum, "%s checksum mismatch", fp)
+		}
+	}
+	return nil
+}
+
+func verifyFileSize(fp string, sz uint64, fs vfs.IFS) error {
+	fi, err := fs.Stat(fp)
+	if err != nil {
+		if vfs.IsNotExist(err) {
+			return errors.Wrapf(ErrSnapshotFileMissing, "%s", fp)
+		}
+		return err
+	}
+	if uint64(fi.Size()) != sz {
+		return errors.Wrapf(ErrSnapshotFileSize,
+			"%s size %d, expect %d", fp, fi.Size(), sz)
+	}
+	return nil
+}
+
+// verifyV2Tail checks the payload length recorded in the tail of a V2
+// snapshot file.
+func verifyV2Tail(f vfs.File, fp string, sz uint64) error {
+	if sz < HeaderSize+tailSize {
+		return errors.Wrapf(ErrSnapshotFileSize, "%s is too small", fp)
+	}
+	tail := make([]byte, tailSize)
+	if err := readFull(f, tail, sz-tailSize); err != nil {
+		return err
+	}
+	if !bytes.Equal(tail[8:], writerMagicNumber) {
+		return errors.Wrapf(ErrSnapshotChecksum, "%s has a corrupted tail", fp)
+	}
+	if binary.LittleEndian.Uint64(tail[:8]) != sz-HeaderSize-tailSize {
+		return errors.Wrapf(ErrSnapshotFileSize,
+			"%s payload length mismatch", fp)
+	}
+	return nil
+}
+
+// verifyBlocks re-hashes the whole snapshot file in the same way as snapshot
+// chunks received from the network are validated.
+func verifyBlocks(f vfs.File, fp string, sz uint64) error {
+	validator := NewSnapshotValidator()
+	data := make([]byte, settings.SnapshotChunkSize)
+	offset := uint64(0)
+	for id := uint64(0); offset < sz; id++ {
+		n := sz - offset
+		if n > settings.SnapshotChunkSize {
+			n = settings.SnapshotChunkSize
+		}
+		if err := readFull(f, data[:n], offset); err != nil {
+			return err
+		}
+		if !validator.AddChunk(data[:n], id) {
+			return errors.Wrapf(ErrSnapshotChecksum, "%s has a corrupted block", fp)
+		}
+		offset += n
+	}
+	if !validator.Validate() {
+		return errors.Wrapf(ErrSnapshotChecksum, "%s has a corrupted block", fp)
+	}
+	return nil
+}
+
+func readFull(f vfs.File, data []byte, offset uint64) error {
+	n, err := f.ReadAt(data, int64(offset))
+	if n == len(data) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func getTestSnapshotFileSize(t *testing.T, fs vfs.IFS) uint64 {
+	fi, err := fs.Stat(testSnapshotFilename)
+	if err != nil {
+		t.Fatalf("failed to stat %v", err)
+	}
+	return uint64(fi.Size())
+}
+
+func TestVerifySnapshotImage(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer func() {
+		if err := fs.RemoveAll(testSnapshotFilename); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	w, _, _ := createTestSnapshotFile(t, V2, fs)
+	checksum := w.GetPayloadChecksum()
+	sz := getTestSnapshotFileSize(t, fs)
+	for _, deep := range []bool{false, true} {
+		if err := VerifySnapshotImage(testSnapshotFilename,
+			sz, checksum, deep, fs); err != nil {
+			t.Errorf("deep %t, failed to verify %v", deep, err)
+		}
+	}
+	tests := []struct {
+		sz       uint64
+		checksum []byte
+		fp       string
+		err      error
+	}{
+		{sz + 1, checksum, testSnapshotFilename, ErrSnapshotFileSize},
+		{sz, []byte{1, 2, 3, 4}, testSnapshotFilename, ErrSnapshotChecksum},
+		{sz, checksum, "missing_file_safe_to_delete", ErrSnapshotFileMissing},
+	}
+	for idx, tt := range tests {
+		err := VerifySnapshotImage(tt.fp, tt.sz, tt.checksum, false, fs)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%d, unexpected error %v", idx, err)
+		}
+	}
+}
+
+func TestVerifySnapshotImageDetectsCorruptedPayload(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer func() {
+		if err := fs.RemoveAll(testSnapshotFilename); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	w, _, _ := createTestSnapshotFile(t, V2, fs)
+	checksum := w.GetPayloadChecksum()
+	corruptSnapshotPayload(t, fs)
+	sz := getTestSnapshotFileSize(t, fs)
+	// only lengths and block checksums are checked without deep verification
+	if err := VerifySnapshotImage(testSnapshotFilename,
+		sz, checksum, false, fs); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	err := VerifySnapshotImage(testSnapshotFilename, sz, checksum, true, fs)
+	if !errors.Is(err, ErrSnapshotChecksum) {
+		t.Errorf("corrupted payload not detected, %v", err)
+	}
+}
+
+func TestVerifySnapshotFile(t *testing.T) {
+	fs := vfs.GetTestFS()
+	fp := "external_file_safe_to_delete"
+	defer func() {
+		if err := fs.RemoveAll(fp); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	write := func(data []byte) {
+		f, err := fs.Create(fp)
+		if err != nil {
+			t.Fatalf("failed to create file %v", err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatalf("failed to write %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("failed to close %v", err)
+		}
+	}
+	write([]byte("external-file-data"))
+	checksum, err := GetFileChecksum(fp, fs)
+	if err != nil {
+		t.Fatalf("failed to get checksum %v", err)
+	}
+	sf := &pb.SnapshotFile{Filepath: fp, FileSize: 18, Checksum: checksum}
+	if err := VerifySnapshotFile(fp, sf, true, fs); err != nil {
+		t.Errorf("failed to verify %v", err)
+	}
+	write([]byte("external-file-DATA"))
+	if err := VerifySnapshotFile(fp, sf, false, fs); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := VerifySnapshotFile(fp,
+		sf, true, fs); !errors.Is(err, ErrSnapshotChecksum) {
+		t.Errorf("corrupted file not detected, %v", err)
+	}
+	write([]byte("external-file"))
+	if err := VerifySnapshotFile(fp,
+		sf, false, fs); !errors.Is(err, ErrSnapshotFileSize) {
+		t.Errorf("truncated file not detected, %v", err)
+	}
+	if err := fs.RemoveAll(fp); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := VerifySnapshotFile(fp,
+		sf, false, fs); !errors.Is(err, ErrSnapshotFileMissing) {
+		t.Errorf("missing file not detected, %v", err)
+	}
+}
@@ -18,6 +18,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/cockroachdb/errors"
@@ -38,6 +40,12 @@ var (
 	plog = logger.GetLogger("server")
 	// ErrNodeHostIDChanged indicates that NodeHostID changed.
 	ErrNodeHostIDChanged = errors.New("NodeHostID changed")
+	// ErrNodeHostIDNotFound indicates that there is no NodeHostID recorded in
+	// the NodeHost directory.
+	ErrNodeHostIDNotFound = errors.New("NodeHostID not found")
+	// ErrInvalidNodeHostID indicates that the specified NodeHostID is not a
+	// valid NodeHostID value.
+	ErrInvalidNodeHostID = errors.New("invalid NodeHostID")
 	// ErrHardSettingChanged indicates that one or more of the hard settings
 	// changed.
 	ErrHardSettingChanged = errors.New("hard setting changed")
@@ -72,9 +80,16 @@ var (
 )
 
 const (
-	flagFilename = "dragonboat.ds"
-	lockFilename = "LOCK"
-	idFilename   = "NODEHOST.ID"
+	flagFilename      = "dragonboat.ds"
+	lockFilename      = "LOCK"
+	lockOwnerFilename = "LOCK.OWNER"
+	idFilename        = "NODEHOST.ID"
+)
+
+var (
+	snapshotPartDirNameRe  = regexp.MustCompile(`^snapshot-part-[0-9]+$`)
+	snapshotNodeDirNameRe  = regexp.MustCompile(`^snapshot-[0-9]+-[0-9]+$`)
+	snapshotNodeDirPartsRe = regexp.MustCompile(`^snapshot-([0-9]+)-([0-9]+)$`)
 )
 
 var firstError = utils.FirstError
@@ -88,6 +103,8 @@ type Env struct {
 	flocks       map[string]io.Closer
 	hostname     string
 	nhConfig     config.NodeHostConfig
+	staging      *StagingSpace
+	wheel        *TimerWheel
 }
 
 // NewEnv creates and returns a new server Env object.
@@ -97,6 +114,8 @@ func NewEnv(nhConfig config.NodeHostConfig, fs vfs.IFS) (*Env, error) {
 		nhConfig:     nhConfig,
 		partitioner:  NewFixedPartitioner(defaultShardIDMod),
 		flocks:       make(map[string]io.Closer),
+		staging:      NewStagingSpace(nhConfig.MaxSnapshotStagingBytes),
+		wheel:        newEnvTimerWheel(nhConfig.RTTMillisecond),
 		fs:           fs,
 	}
 	hostname, err := os.Hostname()
@@ -112,7 +131,12 @@ func NewEnv(nhConfig config.NodeHostConfig, fs vfs.IFS) (*Env, error) {
 
 // Close closes the environment.
 func (env *Env) Close() (err error) {
-	for _, fl := range env.flocks {
+	for fp, fl := range env.flocks {
+		// a lock owner file left behind means that the owner didn't exit cleanly
+		owner := env.fs.PathJoin(env.fs.PathDir(fp), lockOwnerFilename)
+		if rerr := env.fs.Remove(owner); rerr != nil && !vfs.IsNotExist(rerr) {
+			plog.Warningf("failed to remove lock owner file %s, %v", owner, rerr)
+		}
 		err = firstError(err, fl.Close())
 	}
 	return err
@@ -123,6 +147,18 @@ func (env *Env) GetRandomSource() random.Source {
 	return env.randomSource
 }
 
+// GetStagingSpace returns the StagingSpace instance used for accounting the
+// disk space used by snapshot temp directories.
+func (env *Env) GetStagingSpace() *StagingSpace {
+	return env.staging
+}
+
+// GetTimerWheel returns the TimerWheel driven by the NodeHost tick, it is
+// used for managing coarse timeouts without owning runtime timers.
+func (env *Env) GetTimerWheel() *TimerWheel {
+	return env.wheel
+}
+
 // GetSnapshotDir returns the snapshot directory name.
 func (env *Env) GetSnapshotDir(did uint64, shardID uint64,
 	replicaID uint64) string {
@@ -202,8 +238,12 @@ func (env *Env) CreateSnapshotDir(did uint64,
 	return nil
 }
 
-// NodeHostID returns the string representation of the NodeHost ID value.
+// NodeHostID returns the string representation of the NodeHost ID value. An
+// empty string is returned when the NodeHost ID has not been prepared yet.
 func (env *Env) NodeHostID() string {
+	if env.nhid == nil {
+		return ""
+	}
 	return env.nhid.String()
 }
 
@@ -254,15 +294,66 @@ func (env *Env) storeNodeHostID(nhID *id.UUID) error {
 
 func (env *Env) loadNodeHostID() (*id.UUID, error) {
 	dir, _ := env.getDataDirs()
+	return readNodeHostID(dir, env.fs)
+}
+
+func readNodeHostID(dir string, fs vfs.IFS) (*id.UUID, error) {
+	if !fileutil.HasFlagFile(dir, idFilename, fs) {
+		return nil, nil
+	}
+	f, err := fs.Open(fs.PathJoin(dir, idFilename))
+	if err != nil {
+		return nil, err
+	}
+	data, err := fileutil.ReadAll(f)
+	if err := firstError(err, f.Close()); err != nil {
+		return nil, err
+	}
 	var storedUUID id.UUID
-	if fileutil.HasFlagFile(dir, idFilename, env.fs) {
-		if err := fileutil.GetFlagFileContent(dir,
-			idFilename, &storedUUID, env.fs); err != nil {
-			return nil, err
+	if err := fileutil.UnmarshalFlagFileContent(data, &storedUUID); err != nil {
+		return nil, err
+	}
+	return &storedUUID, nil
+}
+
+// ReadNodeHostID returns the NodeHostID recorded in the specified NodeHost
+// directory. ErrNodeHostIDNotFound is returned when there is no recorded
+// NodeHostID.
+func ReadNodeHostID(dir string, fs vfs.IFS) (string, error) {
+	v, err := readNodeHostID(dir, fs)
+	if err != nil {
+		return "", err
+	}
+	if v == nil {
+		return "", ErrNodeHostIDNotFound
+	}
+	return v.String(), nil
+}
+
+// WriteNodeHostID records the specified NodeHostID in the specified NodeHost
+// directory, the directory is created when it doesn't exist. The recorded
+// NodeHostID is never overwritten, ErrNodeHostIDChanged is returned when a
+// different NodeHostID has already been recorded.
+func WriteNodeHostID(dir string, nhID string, fs vfs.IFS) error {
+	n, err := id.NewUUID(nhID)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidNodeHostID, "%s", nhID)
+	}
+	v, err := readNodeHostID(dir, fs)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		if v.String() != n.String() {
+			return errors.Wrapf(ErrNodeHostIDChanged, "existing %s, new %s",
+				v.String(), n.String())
 		}
-		return &storedUUID, nil
+		return nil
+	}
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		return err
 	}
-	return nil, nil
+	return fileutil.CreateFlagFile(dir, idFilename, n, fs)
 }
 
 // SetNodeHostID sets the NodeHostID value recorded in Env. This is typically
@@ -319,6 +410,143 @@ func (env *Env) RemoveSnapshotDir(did uint64,
 	return nil
 }
 
+// RemoveSavedSnapshots removes all existing snapshots of the node without
+// marking its snapshot directory as removed.
+func (env *Env) RemoveSavedSnapshots(did uint64,
+	shardID uint64, replicaID uint64) error {
+	dir := env.GetSnapshotDir(did, shardID, replicaID)
+	exist, err := fileutil.Exist(dir, env.fs)
+	if err != nil {
+		return err
+	}
+	if exist {
+		return removeSavedSnapshots(dir, env.fs)
+	}
+	return nil
+}
+
+// RemoveSnapshotTempDirs removes all snapshot temp directories left behind
+// by snapshot operations interrupted by crashes. It returns the number of
+// removed directories and the number of bytes reclaimed. It must be invoked
+// before any snapshot operation is started.
+func (env *Env) RemoveSnapshotTempDirs(did uint64) (int, uint64, error) {
+	root := env.fs.PathJoin(env.nhConfig.NodeHostDir,
+		env.hostname, env.getDeploymentIDSubDirName(did))
+	parts, err := env.listDirs(root, snapshotPartDirNameRe)
+	if err != nil {
+		return 0, 0, err
+	}
+	count := 0
+	reclaimed := uint64(0)
+	for _, pd := range parts {
+		dirs, err := env.listDirs(pd, snapshotNodeDirNameRe)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, dir := range dirs {
+			names, err := env.fs.List(dir)
+			if err != nil {
+				return 0, 0, err
+			}
+			removed := false
+			for _, name := range names {
+				if !GenSnapshotDirNameRe.MatchString(name) &&
+					!RecvSnapshotDirNameRe.MatchString(name) {
+					continue
+				}
+				tmpDir := env.fs.PathJoin(dir, name)
+				sz, err := fileutil.DirSize(tmpDir, env.fs)
+				if err != nil {
+					return 0, 0, err
+				}
+				if err := env.fs.RemoveAll(tmpDir); err != nil {
+					return 0, 0, err
+				}
+				count++
+				reclaimed += sz
+				removed = true
+			}
+			if removed {
+				if err := fileutil.SyncDir(dir, env.fs); err != nil {
+					return 0, 0, err
+				}
+			}
+		}
+	}
+	return count, reclaimed, nil
+}
+
+// SnapshotDirInfo is the snapshot directory of a replica found in the
+// NodeHost directory.
+type SnapshotDirInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	Path      string
+}
+
+// ListSnapshotDirs returns snapshot directories of all replicas found in the
+// NodeHost directory, including those marked as removed.
+func (env *Env) ListSnapshotDirs(did uint64) ([]SnapshotDirInfo, error) {
+	root := env.fs.PathJoin(env.nhConfig.NodeHostDir,
+		env.hostname, env.getDeploymentIDSubDirName(did))
+	parts, err := env.listDirs(root, snapshotPartDirNameRe)
+	if err != nil {
+		return nil, err
+	}
+	var result []SnapshotDirInfo
+	for _, pd := range parts {
+		dirs, err := env.listDirs(pd, snapshotNodeDirNameRe)
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			m := snapshotNodeDirPartsRe.FindStringSubmatch(env.fs.PathBase(dir))
+			shardID, err := strconv.ParseUint(m[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			replicaID, err := strconv.ParseUint(m[2], 10, 64)
+			if err != nil {
+				continue
+			}
+			result = append(result, SnapshotDirInfo{
+				ShardID:   shardID,
+				ReplicaID: replicaID,
+				Path:      dir,
+			})
+		}
+	}
+	return result, nil
+}
+
+// listDirs returns the paths of sub-directories of the specified directory
+// with names matching re, nothing is returned when dir doesn't exist.
+func (env *Env) listDirs(dir string, re *regexp.Regexp) ([]string, error) {
+	exist, err := fileutil.Exist(dir, env.fs)
+	if err != nil || !exist {
+		return nil, err
+	}
+	names, err := env.fs.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, name := range names {
+		if !re.MatchString(name) {
+			continue
+		}
+		fp := env.fs.PathJoin(dir, name)
+		fi, err := env.fs.Stat(fp)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			result = append(result, fp)
+		}
+	}
+	return result, nil
+}
+
 func (env *Env) markSnapshotDirRemoved(did uint64, shardID uint64,
 	replicaID uint64) error {
 	dir := env.GetSnapshotDir(did, shardID, replicaID)
@@ -369,10 +597,70 @@ func (env *Env) tryLockNodeHostDir(dir string) error {
 			return ErrLockDirectory
 		}
 		env.flocks[fp] = c
+		if err := writeLockOwner(dir, os.Getpid(), env.fs); err != nil {
+			plog.Warningf("failed to record lock owner in %s, %v", dir, err)
+		}
 	}
 	return nil
 }
 
+func writeLockOwner(dir string, pid int, fs vfs.IFS) error {
+	f, err := fs.Create(fs.PathJoin(dir, lockOwnerFilename))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(strconv.Itoa(pid)))
+	err = firstError(err, f.Sync())
+	return firstError(err, f.Close())
+}
+
+func readLockOwner(dir string, fs vfs.IFS) (int, bool, error) {
+	f, err := fs.Open(fs.PathJoin(dir, lockOwnerFilename))
+	if err != nil {
+		if vfs.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	data, err := fileutil.ReadAll(f)
+	if err := firstError(err, f.Close()); err != nil {
+		return 0, false, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, false, err
+	}
+	return pid, true, nil
+}
+
+// CheckDirLock checks the lock of the specified NodeHost data directory
+// without holding it. ErrLockDirectory is returned along with the PID of the
+// owner when the lock is currently held. Otherwise, stale is true when the
+// previous owner with the returned PID exited without releasing the
+// directory, e.g. when it was killed.
+func CheckDirLock(dir string, fs vfs.IFS) (pid int, stale bool, err error) {
+	// file locks are owned by processes, locking the directory again from the
+	// owner process always succeeds and unlocking it releases the lock held by
+	// the owner
+	if pid, ok, err := readLockOwner(dir, fs); err == nil && ok &&
+		pid == os.Getpid() {
+		return pid, false, ErrLockDirectory
+	}
+	c, err := fs.Lock(fs.PathJoin(dir, lockFilename))
+	if err != nil {
+		pid, _, _ = readLockOwner(dir, fs)
+		return pid, false, ErrLockDirectory
+	}
+	if err := c.Close(); err != nil {
+		return 0, false, err
+	}
+	pid, stale, err = readLockOwner(dir, fs)
+	if err != nil {
+		return 0, false, err
+	}
+	return pid, stale, nil
+}
+
 func (env *Env) getDeploymentIDSubDirName(did uint64) string {
 	return fmt.Sprintf("%020d", did)
 }
@@ -446,6 +734,90 @@ func (env *Env) check(cfg config.NodeHostConfig,
 	return nil
 }
 
+// ChangeRaftAddress changes the RaftAddress recorded in the NodeHost data
+// directories from previous to the RaftAddress of cfg. ErrNotOwner is returned
+// when the directories are not owned by a NodeHost using the previous address.
+func (env *Env) ChangeRaftAddress(cfg config.NodeHostConfig,
+	previous string) error {
+	se := func(s1 string, s2 string) bool {
+		return strings.EqualFold(strings.TrimSpace(s1), strings.TrimSpace(s2))
+	}
+	dir, lldir := env.getDataDirs()
+	dirs := []string{dir}
+	if lldir != dir {
+		dirs = append(dirs, lldir)
+	}
+	status := make([]raftpb.RaftDataStatus, len(dirs))
+	for idx, dir := range dirs {
+		if err := fileutil.GetFlagFileContent(dir,
+			flagFilename, &status[idx], env.fs); err != nil {
+			return err
+		}
+		if !se(status[idx].Address, previous) {
+			return ErrNotOwner
+		}
+	}
+	for idx, dir := range dirs {
+		status[idx].Address = cfg.RaftAddress
+		if err := env.replaceFlagFile(dir, &status[idx]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CopyFlagFiles copies the flag files found in the NodeHost directory, which
+// describe the owner of the directory and the NodeHostID, to the specified
+// directory.
+func (env *Env) CopyFlagFiles(dir string) error {
+	src, _ := env.getDataDirs()
+	for _, fn := range []string{flagFilename, idFilename} {
+		fp := env.fs.PathJoin(src, fn)
+		if _, err := env.fs.Stat(fp); vfs.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := vfs.Copy(env.fs, fp, env.fs.PathJoin(dir, fn)); err != nil {
+			return err
+		}
+	}
+	return fileutil.SyncDir(dir, env.fs)
+}
+
+// RelocateNodeHostDir allows the NodeHost directory copied from another host
+// to be owned by a NodeHost using cfg on the local host. Data found under the
+// hostname recorded in the directory is moved under the local hostname, the
+// recorded RaftAddress and hostname are updated.
+func (env *Env) RelocateNodeHostDir(cfg config.NodeHostConfig) error {
+	dir, _ := env.getDataDirs()
+	s := raftpb.RaftDataStatus{}
+	if err := fileutil.GetFlagFileContent(dir, flagFilename, &s, env.fs); err != nil {
+		return err
+	}
+	if len(s.Hostname) > 0 && s.Hostname != env.hostname {
+		if err := env.fs.Rename(env.fs.PathJoin(dir, s.Hostname),
+			env.fs.PathJoin(dir, env.hostname)); err != nil {
+			return err
+		}
+	}
+	s.Address = cfg.RaftAddress
+	s.Hostname = env.hostname
+	return env.replaceFlagFile(dir, &s)
+}
+
+func (env *Env) replaceFlagFile(dir string, s *raftpb.RaftDataStatus) error {
+	tmp := flagFilename + ".tmp"
+	if err := fileutil.CreateFlagFile(dir, tmp, s, env.fs); err != nil {
+		return err
+	}
+	if err := env.fs.Rename(env.fs.PathJoin(dir, tmp),
+		env.fs.PathJoin(dir, flagFilename)); err != nil {
+		return err
+	}
+	return fileutil.SyncDir(dir, env.fs)
+}
+
 func (env *Env) createFlagFile(cfg config.NodeHostConfig,
 	dir string, ver uint32, name string) error {
 	s := raftpb.RaftDataStatus{
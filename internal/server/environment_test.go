@@ -16,6 +16,7 @@ package server
 
 import (
 	"fmt"
+	"os"
 	"strings"
 	"testing"
 
@@ -262,6 +263,50 @@ func TestLockFileCanBeLockedAndUnlocked(t *testing.T) {
 	reportLeakedFD(fs, t)
 }
 
+func TestDirLockOwnerIsReported(t *testing.T) {
+	fs := vfs.GetTestFS()
+	c := getTestNodeHostConfig()
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	env, err := NewEnv(c, fs)
+	if err != nil {
+		t.Fatalf("failed to new environment %v", err)
+	}
+	if _, _, err := env.CreateNodeHostDir(c.DeploymentID); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if pid, stale, err := CheckDirLock(singleNodeHostTestDir, fs); err != nil ||
+		pid != 0 || stale {
+		t.Fatalf("unexpected lock state %d, %t, %v", pid, stale, err)
+	}
+	if err := env.LockNodeHostDir(); err != nil {
+		t.Fatalf("failed to lock the directory %v", err)
+	}
+	pid, _, err := CheckDirLock(singleNodeHostTestDir, fs)
+	if !errors.Is(err, ErrLockDirectory) || pid != os.Getpid() {
+		t.Errorf("lock not reported, %d, %v", pid, err)
+	}
+	if err := env.Close(); err != nil {
+		t.Fatalf("failed to stop env %v", err)
+	}
+	if pid, stale, err := CheckDirLock(singleNodeHostTestDir, fs); err != nil ||
+		pid != 0 || stale {
+		t.Errorf("unexpected lock state %d, %t, %v", pid, stale, err)
+	}
+	// owner of the lock killed without closing its env
+	if err := writeLockOwner(singleNodeHostTestDir, 12345, fs); err != nil {
+		t.Fatalf("failed to write lock owner %v", err)
+	}
+	pid, stale, err := CheckDirLock(singleNodeHostTestDir, fs)
+	if err != nil || pid != 12345 || !stale {
+		t.Errorf("stale lock not reported, %d, %t, %v", pid, stale, err)
+	}
+	reportLeakedFD(fs, t)
+}
+
 func TestNodeHostIDCanBeGenerated(t *testing.T) {
 	fs := vfs.GetTestFS()
 	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
@@ -327,6 +372,88 @@ func TestPrepareNodeHostIDWillReportNodeHostIDChange(t *testing.T) {
 	}
 }
 
+func TestNodeHostIDCanBeWrittenAndRead(t *testing.T) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	if _, err := ReadNodeHostID(singleNodeHostTestDir, fs); !errors.Is(err, ErrNodeHostIDNotFound) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := WriteNodeHostID(singleNodeHostTestDir, "invalid", fs); !errors.Is(err, ErrInvalidNodeHostID) {
+		t.Fatalf("invalid NodeHostID not rejected, %v", err)
+	}
+	v := id.New().String()
+	// the directory is created when it doesn't exist
+	if err := WriteNodeHostID(singleNodeHostTestDir, v, fs); err != nil {
+		t.Fatalf("failed to write NodeHostID %v", err)
+	}
+	if err := WriteNodeHostID(singleNodeHostTestDir, v, fs); err != nil {
+		t.Fatalf("failed to write the same NodeHostID again %v", err)
+	}
+	if err := WriteNodeHostID(singleNodeHostTestDir,
+		id.New().String(), fs); !errors.Is(err, ErrNodeHostIDChanged) {
+		t.Fatalf("NodeHostID overwritten, %v", err)
+	}
+	read, err := ReadNodeHostID(singleNodeHostTestDir, fs)
+	if err != nil {
+		t.Fatalf("failed to read NodeHostID %v", err)
+	}
+	if read != v {
+		t.Errorf("read %s, want %s", read, v)
+	}
+	// the recorded NodeHostID is used by the Env
+	c := getTestNodeHostConfig()
+	env, err := NewEnv(c, fs)
+	if err != nil {
+		t.Fatalf("failed to create env %v", err)
+	}
+	nhid, err := env.PrepareNodeHostID("")
+	if err != nil {
+		t.Fatalf("failed to prepare nodehost id %v", err)
+	}
+	if nhid.String() != v {
+		t.Errorf("unexpected NodeHostID %s", nhid.String())
+	}
+}
+
+func TestCorruptedNodeHostIDIsReported(t *testing.T) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := fs.MkdirAll(singleNodeHostTestDir, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	f, err := fs.Create(fs.PathJoin(singleNodeHostTestDir, idFilename))
+	if err != nil {
+		t.Fatalf("failed to create file %v", err)
+	}
+	if _, err := f.Write([]byte("corrupted NodeHostID")); err != nil {
+		t.Fatalf("failed to write file %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close file %v", err)
+	}
+	if _, err := ReadNodeHostID(singleNodeHostTestDir, fs); !errors.Is(err, fileutil.ErrCorruptedFlagFile) {
+		t.Fatalf("corrupted NodeHostID not reported, %v", err)
+	}
+	if err := WriteNodeHostID(singleNodeHostTestDir,
+		id.New().String(), fs); !errors.Is(err, fileutil.ErrCorruptedFlagFile) {
+		t.Fatalf("corrupted NodeHostID overwritten, %v", err)
+	}
+}
+
 func TestRemoveSavedSnapshots(t *testing.T) {
 	fs := vfs.GetTestFS()
 	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
@@ -427,3 +554,65 @@ func TestCompatibleLogDBType(t *testing.T) {
 		}
 	}
 }
+
+func TestRemoveSnapshotTempDirs(t *testing.T) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	env, err := NewEnv(getTestNodeHostConfig(), fs)
+	if err != nil {
+		t.Fatalf("failed to new environment %v", err)
+	}
+	if count, reclaimed, err := env.RemoveSnapshotTempDirs(
+		testDeploymentID); err != nil || count != 0 || reclaimed != 0 {
+		t.Fatalf("unexpected result %d, %d, %v", count, reclaimed, err)
+	}
+	if _, _, err := env.CreateNodeHostDir(testDeploymentID); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := env.CreateSnapshotDir(testDeploymentID, 1, 2); err != nil {
+		t.Fatalf("failed to create snapshot dir %v", err)
+	}
+	dir := env.GetSnapshotDir(testDeploymentID, 1, 2)
+	for _, name := range []string{
+		"snapshot-0000000000000010",
+		"snapshot-0000000000000020-3.generating",
+		"snapshot-0000000000000030-3.receiving",
+	} {
+		fp := fs.PathJoin(dir, name)
+		if err := fs.MkdirAll(fp, 0755); err != nil {
+			t.Fatalf("failed to mkdir %v", err)
+		}
+		f, err := fs.Create(fs.PathJoin(fp, "data"))
+		if err != nil {
+			t.Fatalf("failed to create file %v", err)
+		}
+		if _, err := f.Write(make([]byte, 100)); err != nil {
+			t.Fatalf("failed to write %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("failed to close %v", err)
+		}
+	}
+	count, reclaimed, err := env.RemoveSnapshotTempDirs(testDeploymentID)
+	if err != nil {
+		t.Fatalf("failed to remove temp dirs %v", err)
+	}
+	if count != 2 || reclaimed != 200 {
+		t.Errorf("unexpected result %d, %d", count, reclaimed)
+	}
+	names, err := fs.List(dir)
+	if err != nil {
+		t.Fatalf("failed to list %v", err)
+	}
+	if len(names) != 1 || names[0] != "snapshot-0000000000000010" {
+		t.Errorf("unexpected dirs %v", names)
+	}
+	reportLeakedFD(fs, t)
+}
@@ -15,6 +15,8 @@
 package server
 
 import (
+	"time"
+
 	pb "github.com/lni/dragonboat/v4/raftpb"
 )
 
@@ -71,15 +73,38 @@ type ReadIndexInfo struct {
 	ReplicaID uint64
 }
 
+// StagedPromotionInfo contains info of a staged non-voting member.
+type StagedPromotionInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// StagedReplicaID is the ReplicaID of the staged non-voting member.
+	StagedReplicaID uint64
+	Match           uint64
+}
+
+// NonVotingLagInfo contains info of a non-voting member lagging behind.
+type NonVotingLagInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// NonVotingReplicaID is the ReplicaID of the non-voting member.
+	NonVotingReplicaID uint64
+	Match              uint64
+	Lag                uint64
+}
+
 // IRaftEventListener is the event listener used by the Raft implementation.
 type IRaftEventListener interface {
 	LeaderUpdated(info LeaderInfo)
 	CampaignLaunched(info CampaignInfo)
 	CampaignSkipped(info CampaignInfo)
+	CampaignSuppressed(info CampaignInfo)
 	SnapshotRejected(info SnapshotInfo)
 	ReplicationRejected(info ReplicationInfo)
 	ProposalDropped(info ProposalInfo)
 	ReadIndexDropped(info ReadIndexInfo)
+	StagedPromotionTimeout(info StagedPromotionInfo)
+	NonVotingLagging(info NonVotingLagInfo)
+	NonVotingLagRecovered(info NonVotingLagInfo)
 }
 
 // SystemEventType is the type of system events.
@@ -100,12 +125,22 @@ const (
 	ConnectionEstablished
 	// ConnectionFailed ...
 	ConnectionFailed
+	// ConnectionRejected ...
+	ConnectionRejected
+	// MisdeliveredMessage ...
+	MisdeliveredMessage
 	// SendSnapshotStarted ...
 	SendSnapshotStarted
 	// SendSnapshotCompleted ...
 	SendSnapshotCompleted
 	// SendSnapshotAborted ...
 	SendSnapshotAborted
+	// SnapshotReceiveStarted ...
+	SnapshotReceiveStarted
+	// SnapshotReceiveProgress ...
+	SnapshotReceiveProgress
+	// SnapshotReceiveAborted ...
+	SnapshotReceiveAborted
 	// SnapshotReceived ...
 	SnapshotReceived
 	// SnapshotRecovered ...
@@ -118,16 +153,91 @@ const (
 	LogCompacted
 	// LogDBCompacted ...
 	LogDBCompacted
+	// StagedPromotionTimeout ...
+	StagedPromotionTimeout
+	// NonVotingLagging ...
+	NonVotingLagging
+	// NonVotingLagRecovered ...
+	NonVotingLagRecovered
+	// BootstrapMismatch ...
+	BootstrapMismatch
+	// SlowStateMachine ...
+	SlowStateMachine
+	// SlowDisk ...
+	SlowDisk
+	// ApplyStalled ...
+	ApplyStalled
+	// ApplyStallCleared ...
+	ApplyStallCleared
+	// ListenerPanicked ...
+	ListenerPanicked
+	// DiskSpaceLow ...
+	DiskSpaceLow
+	// DiskSpaceCritical ...
+	DiskSpaceCritical
+	// DiskSpaceRecovered ...
+	DiskSpaceRecovered
+	// QuiesceEntered ...
+	QuiesceEntered
+	// QuiesceExited ...
+	QuiesceExited
+	// LogRetentionExceeded ...
+	LogRetentionExceeded
+	// SnapshotFingerprintMismatch ...
+	SnapshotFingerprintMismatch
+	// GossipIsolated ...
+	GossipIsolated
+	// GossipRejoined ...
+	GossipRejoined
+	// NodeHostSuspected ...
+	NodeHostSuspected
+	// NodeHostRecovered ...
+	NodeHostRecovered
+	// OrphanedDataPurged ...
+	OrphanedDataPurged
+	// StartupAuditFailed ...
+	StartupAuditFailed
+	// CampaignSuppressed ...
+	CampaignSuppressed
+	// LeaderDegraded ...
+	LeaderDegraded
+	// NodeRemovedFromShard ...
+	NodeRemovedFromShard
+	// EnginePanicked ...
+	EnginePanicked
 )
 
 // SystemEvent is an system event record published by the system that can be
 // handled by a raftio.ISystemEventListener.
 type SystemEvent struct {
+	NodeHostID         string
 	Address            string
+	Path               string
+	Reason             string
+	Listener           string
+	Callback           string
+	Operation          string
 	Type               SystemEventType
 	ShardID            uint64
 	ReplicaID          uint64
 	From               uint64
+	Target             uint64
 	Index              uint64
+	FirstIndex         uint64
+	LastIndex          uint64
+	ReceivedBytes      uint64
+	TotalBytes         uint64
+	Completed          uint64
+	Total              uint64
+	AvailBytes         uint64
+	Lag                uint64
+	Ticks              uint64
+	Members            uint64
+	Term               uint64
+	LocalHash          uint64
+	RemoteHash         uint64
+	RequestID          []byte
+	Duration           time.Duration
+	Interval           time.Duration
 	SnapshotConnection bool
 }
@@ -0,0 +1,156 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+const (
+	// FormatVersion is the version of the on disk format of data written to
+	// NodeHost directories. It must be bumped whenever any format described by
+	// Format changes, together with a new entry in Formats and a new golden
+	// data directory for the internal/compat tests.
+	FormatVersion uint32 = 1
+	// MinFormatVersion is the oldest format version that can be opened and
+	// upgraded in place.
+	MinFormatVersion uint32 = 1
+	// FormatManifestFilename is the name of the format manifest file.
+	FormatManifestFilename = "FORMAT"
+)
+
+var (
+	// ErrIncompatibleFormat indicates that the NodeHost directory contains
+	// data written in a format version that is not supported.
+	ErrIncompatibleFormat = errors.New("incompatible on disk format version")
+)
+
+// Format describes the on disk formats of a format version.
+type Format struct {
+	// LogDBBinVersions are the binary versions of supported LogDB types.
+	LogDBBinVersions []uint32
+	// SnapshotVersion is the version of snapshot files.
+	SnapshotVersion uint64
+}
+
+// Formats are the declared on disk formats of all format versions. Values
+// here are intentionally literals rather than references to the constants
+// defining the formats, changing those constants without bumping
+// FormatVersion is detected by the internal/compat tests.
+var Formats = map[uint32]Format{
+	1: {
+		LogDBBinVersions: []uint32{100, 210},
+		SnapshotVersion:  2,
+	},
+}
+
+// Includes returns a boolean value indicating whether data described by the
+// manifest is in the format f.
+func (f Format) Includes(m FormatManifest) bool {
+	if m.SnapshotVersion != f.SnapshotVersion {
+		return false
+	}
+	for _, v := range f.LogDBBinVersions {
+		if v == m.LogDBBinVersion {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatManifest is the content of the format manifest file kept in the
+// NodeHost data directory. It records the format of data in the directory.
+type FormatManifest struct {
+	FormatVersion   uint32
+	LogDBType       string
+	LogDBBinVersion uint32
+	SnapshotVersion uint64
+}
+
+// LoadFormatManifest loads the format manifest file from the specified
+// directory.
+func LoadFormatManifest(dir string, fs vfs.IFS) (FormatManifest, error) {
+	f, err := fs.Open(fs.PathJoin(dir, FormatManifestFilename))
+	if err != nil {
+		return FormatManifest{}, err
+	}
+	data, err := fileutil.ReadAll(f)
+	if err := firstError(err, f.Close()); err != nil {
+		return FormatManifest{}, err
+	}
+	var m FormatManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return FormatManifest{}, errors.Wrapf(err, "corrupted format manifest")
+	}
+	return m, nil
+}
+
+// CheckFormatManifest checks the format manifest of the NodeHost data
+// directory. ErrIncompatibleFormat is returned when the directory contains
+// data in a format version newer than FormatVersion or older than
+// MinFormatVersion. The manifest is created when missing and is updated to
+// describe current when the directory is opened by the current version, data
+// written by older versions stays readable as it is required by
+// MinFormatVersion.
+func (env *Env) CheckFormatManifest(current FormatManifest) error {
+	dir, _ := env.getDataDirs()
+	current.FormatVersion = FormatVersion
+	m, err := LoadFormatManifest(dir, env.fs)
+	if vfs.IsNotExist(err) {
+		// directories created before the format manifest was introduced are
+		// in the first format version
+		return env.saveFormatManifest(dir, current)
+	}
+	if err != nil {
+		return err
+	}
+	if m.FormatVersion > FormatVersion || m.FormatVersion < MinFormatVersion {
+		return errors.Wrapf(ErrIncompatibleFormat,
+			"format version %d, supported [%d, %d]",
+			m.FormatVersion, MinFormatVersion, FormatVersion)
+	}
+	if m == current {
+		return nil
+	}
+	plog.Infof("updating format manifest from %+v to %+v", m, current)
+	return env.saveFormatManifest(dir, current)
+}
+
+func (env *Env) saveFormatManifest(dir string, m FormatManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := env.fs.PathJoin(dir, FormatManifestFilename+".tmp")
+	f, err := env.fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	err = firstError(err, f.Sync())
+	if err := firstError(err, f.Close()); err != nil {
+		return err
+	}
+	if err := env.fs.Rename(tmp,
+		env.fs.PathJoin(dir, FormatManifestFilename)); err != nil {
+		return err
+	}
+	return fileutil.SyncDir(dir, env.fs)
+}
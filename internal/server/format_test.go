@@ -0,0 +1,78 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+func TestFormatManifestIsCreatedAndChecked(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	func() {
+		env, err := NewEnv(getTestNodeHostConfig(), fs)
+		if err != nil {
+			t.Fatalf("failed to new environment %v", err)
+		}
+		if _, _, err := env.CreateNodeHostDir(testDeploymentID); err != nil {
+			t.Fatalf("%v", err)
+		}
+		dir, _ := env.getDataDirs()
+		current := FormatManifest{
+			LogDBType:       testLogDBName,
+			LogDBBinVersion: testBinVer,
+			SnapshotVersion: 2,
+		}
+		if err := env.CheckFormatManifest(current); err != nil {
+			t.Fatalf("failed to create manifest %v", err)
+		}
+		m, err := LoadFormatManifest(dir, fs)
+		if err != nil {
+			t.Fatalf("failed to load manifest %v", err)
+		}
+		current.FormatVersion = FormatVersion
+		if m != current {
+			t.Errorf("manifest %+v, want %+v", m, current)
+		}
+		if !Formats[FormatVersion].Includes(m) {
+			t.Errorf("manifest %+v not in the declared format", m)
+		}
+		m.FormatVersion = FormatVersion + 1
+		if err := env.saveFormatManifest(dir, m); err != nil {
+			t.Fatalf("failed to save manifest %v", err)
+		}
+		if err := env.CheckFormatManifest(current); !errors.Is(err,
+			ErrIncompatibleFormat) {
+			t.Errorf("newer format not reported, %v", err)
+		}
+		m.FormatVersion = MinFormatVersion - 1
+		if err := env.saveFormatManifest(dir, m); err != nil {
+			t.Fatalf("failed to save manifest %v", err)
+		}
+		if err := env.CheckFormatManifest(current); !errors.Is(err,
+			ErrIncompatibleFormat) {
+			t.Errorf("unsupported older format not reported, %v", err)
+		}
+	}()
+	reportLeakedFD(fs, t)
+}
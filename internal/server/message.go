@@ -15,6 +15,7 @@
 package server
 
 import (
+	"math"
 	"sync"
 	"sync/atomic"
 
@@ -150,8 +151,34 @@ func (q *MessageQueue) MustAdd(msg pb.Message) bool {
 	return true
 }
 
+// Capacity returns the number of messages and the total in memory size of
+// entries in bytes that can still be added to the queue.
+func (q *MessageQueue) Capacity() (uint64, uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	messages := uint64(0)
+	if q.idx < q.size {
+		messages = q.size - q.idx
+	}
+	bytes := uint64(math.MaxUint64)
+	if q.rl.Enabled() {
+		bytes = 0
+		if sz := q.rl.Get(); sz < q.rl.maxSize {
+			bytes = q.rl.maxSize - sz
+		}
+	}
+	return messages, bytes
+}
+
+// Size returns the total in memory size of entries in bytes currently queued.
+func (q *MessageQueue) Size() uint64 {
+	return q.rl.Get()
+}
+
+// tryAdd accounts the entries of Replicate messages, the size is recorded even
+// when rate limiting is disabled.
 func (q *MessageQueue) tryAdd(msg pb.Message) bool {
-	if !q.rl.Enabled() || msg.Type != pb.Replicate {
+	if msg.Type != pb.Replicate {
 		return true
 	}
 	if q.rl.RateLimited() {
@@ -208,9 +235,7 @@ func (q *MessageQueue) Get() []pb.Message {
 	q.leftInWrite = !q.leftInWrite
 	q.gc()
 	q.oldIdx = sz
-	if q.rl.Enabled() {
-		q.rl.Set(0)
-	}
+	q.rl.Set(0)
 	if len(q.nodrop) == 0 && len(q.delayed) == 0 {
 		return t[:sz]
 	}
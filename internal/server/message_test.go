@@ -277,3 +277,46 @@ func TestDelayedMessage(t *testing.T) {
 	require.Equal(t, dm1, result[1])
 	require.Equal(t, rm, result[2])
 }
+
+func TestMessageQueueCapacityIsReported(t *testing.T) {
+	q := NewMessageQueue(8, false, 0, 1024)
+	m := pb.Message{
+		Type:    pb.Replicate,
+		Entries: []pb.Entry{{Index: 1, Cmd: make([]byte, 16)}},
+	}
+	for i := 0; i < 3; i++ {
+		if added, stopped := q.Add(m); !added || stopped {
+			t.Fatalf("failed to add")
+		}
+	}
+	messages, bytes := q.Capacity()
+	if messages != 5 {
+		t.Errorf("got %d, want 5", messages)
+	}
+	if bytes != 1024-3*pb.GetEntrySliceInMemSize(m.Entries) {
+		t.Errorf("unexpected bytes %d", bytes)
+	}
+	q.Get()
+	messages, bytes = q.Capacity()
+	if messages != 8 || bytes != 1024 {
+		t.Errorf("unexpected capacity %d, %d", messages, bytes)
+	}
+}
+
+func TestMessageQueueSizeIsTrackedWhenNotRateLimited(t *testing.T) {
+	q := NewMessageQueue(8, false, 0, 0)
+	e := pb.Entry{Index: 1, Cmd: make([]byte, 1024)}
+	if added, _ := q.Add(pb.Message{Type: pb.Replicate, Entries: []pb.Entry{e}}); !added {
+		t.Fatalf("failed to add")
+	}
+	if q.Size() != pb.GetEntrySliceInMemSize([]pb.Entry{e}) {
+		t.Errorf("unexpected size %d", q.Size())
+	}
+	if q.rl.RateLimited() {
+		t.Errorf("unexpectedly rate limited")
+	}
+	q.Get()
+	if q.Size() != 0 {
+		t.Errorf("size not reset")
+	}
+}
@@ -165,6 +165,18 @@ func (r *InMemRateLimiter) RateLimited() bool {
 	return r.limited
 }
 
+// ReleaseRequired returns a boolean flag indicating whether the recorded in
+// memory log size is large enough to have saved entries released from memory.
+func (r *InMemRateLimiter) ReleaseRequired() bool {
+	return r.Enabled() && r.Get() >= r.releaseThreshold()
+}
+
+// releaseThreshold is the in memory log size from which saved entries are
+// released, a rate limited node is no longer limited once below it.
+func (r *InMemRateLimiter) releaseThreshold() uint64 {
+	return r.rl.maxSize * 7 / 10
+}
+
 func (r *InMemRateLimiter) limitedByInMemSize() bool {
 	if !r.Enabled() {
 		return false
@@ -190,7 +202,7 @@ func (r *InMemRateLimiter) limitedByInMemSize() bool {
 	if !r.limited {
 		return maxInMemSize > r.rl.maxSize
 	}
-	return maxInMemSize >= (r.rl.maxSize * 7 / 10)
+	return maxInMemSize >= r.releaseThreshold()
 }
 
 func (r *InMemRateLimiter) gc() {
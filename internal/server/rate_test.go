@@ -140,6 +140,23 @@ func TestRateLimited(t *testing.T) {
 	}
 }
 
+func TestReleaseRequired(t *testing.T) {
+	r := NewInMemRateLimiter(100)
+	r.Increase(69)
+	if r.ReleaseRequired() {
+		t.Errorf("release unexpectedly required")
+	}
+	r.Increase(1)
+	if !r.ReleaseRequired() {
+		t.Errorf("release not required")
+	}
+	r = NewInMemRateLimiter(0)
+	r.Increase(100)
+	if r.ReleaseRequired() {
+		t.Errorf("release required when not enabled")
+	}
+}
+
 func TestRateLimitedWhenFollowerIsRateLimited(t *testing.T) {
 	r := NewInMemRateLimiter(100)
 	r.Increase(100)
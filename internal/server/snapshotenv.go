@@ -23,6 +23,7 @@ import (
 
 	"github.com/cockroachdb/errors"
 
+	"github.com/lni/dragonboat/v4/internal/failpoint"
 	"github.com/lni/dragonboat/v4/internal/fileutil"
 	"github.com/lni/dragonboat/v4/internal/vfs"
 	pb "github.com/lni/dragonboat/v4/raftpb"
@@ -190,7 +191,13 @@ func (se *SSEnv) FinalizeSnapshot(msg pb.Marshaler) error {
 	if se.finalDirExists() {
 		return ErrSnapshotOutOfDate
 	}
-	return se.renameToFinalDir()
+	if err := failpoint.Inject(failpoint.BeforeSnapshotRename); err != nil {
+		return err
+	}
+	if err := se.renameToFinalDir(); err != nil {
+		return err
+	}
+	return failpoint.Inject(failpoint.AfterSnapshotRename)
 }
 
 // CreateTempDir creates the temp snapshot directory.
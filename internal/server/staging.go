@@ -0,0 +1,180 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"sync"
+	"syscall"
+
+	"github.com/cockroachdb/errors"
+)
+
+// IsNoSpace returns a boolean value indicating whether the specified error is
+// caused by running out of disk space.
+func IsNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// StagingStats contains the stats of the disk space used by snapshot temp
+// directories.
+type StagingStats struct {
+	// Bytes is the number of bytes currently held in snapshot temp directories.
+	Bytes uint64
+	// Limit is the configured max number of bytes, 0 means unlimited.
+	Limit uint64
+	// Deferred is the total number of snapshot operations deferred as the
+	// limit was reached.
+	Deferred uint64
+}
+
+// StagingSpace accounts the disk space used by snapshot temp directories of
+// all replicas on a NodeHost, i.e. snapshots being saved and snapshots being
+// received. Bytes are accounted against the temp directory they are written
+// to and they are released once the directory is finalized or removed.
+type StagingSpace struct {
+	limit uint64
+	mu    sync.Mutex
+	dirs  map[string]uint64
+	bytes uint64
+	// released is closed and replaced whenever bytes are released
+	released chan struct{}
+	deferred uint64
+}
+
+// NewStagingSpace creates a new StagingSpace instance with the specified
+// limit, 0 means unlimited.
+func NewStagingSpace(limit uint64) *StagingSpace {
+	return &StagingSpace{
+		limit:    limit,
+		dirs:     make(map[string]uint64),
+		released: make(chan struct{}),
+	}
+}
+
+// Add accounts sz bytes written to the specified temp directory.
+func (s *StagingSpace) Add(dir string, sz uint64) {
+	if s == nil || sz == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirs[dir] += sz
+	s.bytes += sz
+}
+
+// Release releases all bytes accounted against the specified temp directory.
+func (s *StagingSpace) Release(dir string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sz, ok := s.dirs[dir]
+	if !ok {
+		return
+	}
+	delete(s.dirs, dir)
+	s.bytes -= sz
+	close(s.released)
+	s.released = make(chan struct{})
+}
+
+// Full returns a boolean value indicating whether the limit has been reached.
+// New snapshot operations are expected to be deferred when it returns true,
+// they are counted as deferred.
+func (s *StagingSpace) Full() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fullLocked() {
+		s.deferred++
+		return true
+	}
+	return false
+}
+
+func (s *StagingSpace) fullLocked() bool {
+	return s.limit > 0 && s.bytes >= s.limit
+}
+
+// Wait blocks until the limit is no longer reached or until stopc is closed.
+// It returns a boolean value indicating whether the limit is no longer
+// reached, waiting operations are counted as deferred.
+func (s *StagingSpace) Wait(stopc <-chan struct{}) bool {
+	if s == nil {
+		return true
+	}
+	counted := false
+	for {
+		s.mu.Lock()
+		if !s.fullLocked() {
+			s.mu.Unlock()
+			return true
+		}
+		if !counted {
+			s.deferred++
+			counted = true
+		}
+		ch := s.released
+		s.mu.Unlock()
+		select {
+		case <-ch:
+		case <-stopc:
+			return false
+		}
+	}
+}
+
+// Stats returns the stats of the staging space.
+func (s *StagingSpace) Stats() StagingStats {
+	if s == nil {
+		return StagingStats{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return StagingStats{
+		Bytes:    s.bytes,
+		Limit:    s.limit,
+		Deferred: s.deferred,
+	}
+}
+
+// Writer returns an io.WriteCloser that writes to w and accounts the written
+// bytes against the specified temp directory. w is returned when s is nil.
+func (s *StagingSpace) Writer(dir string, w io.WriteCloser) io.WriteCloser {
+	if s == nil {
+		return w
+	}
+	return &stagingWriter{w: w, s: s, dir: dir}
+}
+
+type stagingWriter struct {
+	w   io.WriteCloser
+	s   *StagingSpace
+	dir string
+}
+
+func (w *stagingWriter) Write(data []byte) (int, error) {
+	n, err := w.w.Write(data)
+	w.s.Add(w.dir, uint64(n))
+	return n, err
+}
+
+func (w *stagingWriter) Close() error {
+	return w.w.Close()
+}
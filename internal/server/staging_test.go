@@ -0,0 +1,104 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+type discardCloser struct {
+	io.Writer
+}
+
+func (discardCloser) Close() error { return nil }
+
+func TestStagingSpaceAccountsBytesByDir(t *testing.T) {
+	s := NewStagingSpace(0)
+	s.Add("a", 10)
+	s.Add("a", 20)
+	w := s.Writer("b", discardCloser{io.Discard})
+	if _, err := w.Write(make([]byte, 5)); err != nil {
+		t.Fatalf("write failed %v", err)
+	}
+	if st := s.Stats(); st.Bytes != 35 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	s.Release("a")
+	s.Release("c")
+	if st := s.Stats(); st.Bytes != 5 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	s.Release("b")
+	if st := s.Stats(); st.Bytes != 0 || s.Full() {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestStagingSpaceDefersOperationsWhenFull(t *testing.T) {
+	s := NewStagingSpace(100)
+	s.Add("a", 100)
+	if !s.Full() {
+		t.Fatalf("not full")
+	}
+	done := make(chan bool, 1)
+	go func() {
+		done <- s.Wait(nil)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("wait unexpectedly returned")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Release("a")
+	if !<-done {
+		t.Errorf("wait failed")
+	}
+	s.Add("a", 100)
+	stopc := make(chan struct{})
+	close(stopc)
+	if s.Wait(stopc) {
+		t.Errorf("wait unexpectedly succeeded")
+	}
+	if st := s.Stats(); st.Limit != 100 || st.Deferred != 3 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestNilStagingSpace(t *testing.T) {
+	var s *StagingSpace
+	s.Add("a", 100)
+	s.Release("a")
+	w := discardCloser{io.Discard}
+	if s.Full() || !s.Wait(nil) || s.Writer("a", w) != w ||
+		s.Stats() != (StagingStats{}) {
+		t.Errorf("unexpected nil StagingSpace behavior")
+	}
+}
+
+func TestIsNoSpace(t *testing.T) {
+	err := &os.PathError{Op: "write", Path: "f", Err: syscall.ENOSPC}
+	if !IsNoSpace(err) || !IsNoSpace(errors.Wrap(err, "failed")) {
+		t.Errorf("ENOSPC not detected")
+	}
+	if IsNoSpace(errors.New("other")) || IsNoSpace(nil) {
+		t.Errorf("unexpected result")
+	}
+}
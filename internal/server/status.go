@@ -0,0 +1,124 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+)
+
+// RaftStatus is a point-in-time view of the Raft state of a replica.
+type RaftStatus struct {
+	// Remotes is the replication progress of all other replicas, it is only
+	// available on the leader.
+	Remotes              []RemoteStatus
+	State                string
+	Term                 uint64
+	Vote                 uint64
+	LeaderID             uint64
+	Committed            uint64
+	Processed            uint64
+	Applied              uint64
+	FirstIndex           uint64
+	LastIndex            uint64
+	InMemEntries         uint64
+	InMemBytes           uint64
+	InMemRetention       InMemLogRetention
+	PendingReadIndexes   uint64
+	LeaderTransferTarget uint64
+	TickCount            uint64
+	ElectionTick         uint64
+	HeartbeatTick        uint64
+	ElectionTimeout      uint64
+	PendingConfigChange  bool
+}
+
+// InMemLogRetention contains the size in bytes of log entries kept in memory
+// grouped by the reason they can not be released yet.
+type InMemLogRetention struct {
+	// Unapplied is the size of saved entries not applied yet, they can not be
+	// released when the MaxInMemLogSize limit is approached.
+	Unapplied uint64
+	// Unpersisted is the size of entries not saved to the LogDB yet, they can
+	// not be released when the MaxInMemLogSize limit is approached.
+	Unpersisted uint64
+	// FollowerNeeded is the size of applied and saved entries not yet
+	// acknowledged by all followers, it is only reported on the leader.
+	FollowerNeeded uint64
+}
+
+// RemoteStatus is the replication progress of a remote replica as tracked by
+// the leader.
+type RemoteStatus struct {
+	// Type is one of Voting, NonVoting and Witness.
+	Type          string
+	State         string
+	ReplicaID     uint64
+	Match         uint64
+	Next          uint64
+	SnapshotIndex uint64
+	LastActive    uint64
+	Active        bool
+	// Throttled indicates whether the replication to the remote is throttled
+	// as it is catching up.
+	Throttled bool
+}
+
+// ElectionStats contains the election and heartbeat timing statistics of a
+// replica.
+type ElectionStats struct {
+	// Peers is the heartbeat statistics of other replicas as observed by the
+	// local replica when it is the leader, it is sorted by ReplicaID.
+	Peers     []HeartbeatStats
+	ShardID   uint64
+	ReplicaID uint64
+	// ElectionsStarted, ElectionsWon and ElectionsLost are the numbers of
+	// elections started by the local replica and their outcomes. PreVote
+	// campaigns are not counted as elections.
+	ElectionsStarted uint64
+	ElectionsWon     uint64
+	ElectionsLost    uint64
+	// PreVoteRejections is the number of rejected PreVote requests received by
+	// the local replica.
+	PreVoteRejections uint64
+	// HeartbeatRTTP99 is the estimated p99 of heartbeat round-trip times
+	// observed when the local replica is the leader, it is an upper bound of
+	// the histogram bucket that contains the p99 value.
+	HeartbeatRTTP99 time.Duration
+	// LeaderlessPeriods is the number of completed periods during which the
+	// local replica didn't know the leader. LeaderlessP50, LeaderlessP99 and
+	// LeaderlessMax describe the distribution of their durations.
+	LeaderlessPeriods uint64
+	LeaderlessP50     time.Duration
+	LeaderlessP99     time.Duration
+	LeaderlessMax     time.Duration
+	// Leaderless is the duration of the current leaderless period, it is 0
+	// when the leader is known.
+	Leaderless time.Duration
+}
+
+// HeartbeatStats contains the heartbeat statistics of a remote replica as
+// observed by the leader.
+type HeartbeatStats struct {
+	ReplicaID uint64
+	// RTT and RTTVariance are the exponentially weighted moving average of the
+	// heartbeat round-trip time and of its deviation.
+	RTT         time.Duration
+	RTTVariance time.Duration
+	// Samples is the number of observed heartbeat round trips.
+	Samples uint64
+	// Missed is the number of heartbeats not responded before the next
+	// heartbeat was sent.
+	Missed uint64
+}
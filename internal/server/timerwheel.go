@@ -0,0 +1,219 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTimerWheelSlots is the number of slots of the timer wheel, it must
+	// be a power of 2.
+	defaultTimerWheelSlots = 4096
+	// defaultTimerWheelInterval is the tick interval of the timer wheel used
+	// when RTTMillisecond is not set.
+	defaultTimerWheelInterval = 10 * time.Millisecond
+)
+
+// Timer is a timer registered on a TimerWheel.
+type Timer struct {
+	wheel  *TimerWheel
+	f      func()
+	prev   *Timer
+	next   *Timer
+	expire uint64
+	period uint64
+	active bool
+}
+
+// Stop cancels the timer. It returns a boolean value indicating whether the
+// timer was active. The callback might still be invoked once when it has
+// already been picked up by a concurrent Tick call.
+func (t *Timer) Stop() bool {
+	w := t.wheel
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	t.period = 0
+	if !t.active {
+		return false
+	}
+	w.remove(t)
+	return true
+}
+
+// Reset changes the timer to expire after the specified number of ticks. It
+// returns a boolean value indicating whether the timer was active.
+func (t *Timer) Reset(ticks uint64) bool {
+	w := t.wheel
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	active := t.active
+	if active {
+		w.remove(t)
+	}
+	w.add(t, ticks)
+	return active
+}
+
+// TimerWheel is a hashed timer wheel driven by an external tick source, e.g.
+// the NodeHost tick. Timers registered on the wheel do not own any runtime
+// timer, their precision is the tick interval of the wheel. Callbacks are
+// invoked by the goroutine calling Tick, they must not block.
+type TimerWheel struct {
+	mu       sync.Mutex
+	interval time.Duration
+	slots    []*Timer
+	mask     uint64
+	tick     uint64
+	count    int
+	expired  []*Timer
+}
+
+// NewTimerWheel creates a new TimerWheel instance with the specified tick
+// interval and number of slots. The number of slots must be a power of 2.
+func NewTimerWheel(interval time.Duration, slots uint64) *TimerWheel {
+	if slots == 0 || slots&(slots-1) != 0 {
+		plog.Panicf("invalid number of slots %d", slots)
+	}
+	return &TimerWheel{
+		interval: interval,
+		slots:    make([]*Timer, slots),
+		mask:     slots - 1,
+	}
+}
+
+func newEnvTimerWheel(rttMillisecond uint64) *TimerWheel {
+	interval := defaultTimerWheelInterval
+	if rttMillisecond > 0 {
+		interval = time.Duration(rttMillisecond) * time.Millisecond
+	}
+	return NewTimerWheel(interval, defaultTimerWheelSlots)
+}
+
+// Interval returns the tick interval of the wheel.
+func (w *TimerWheel) Interval() time.Duration {
+	return w.interval
+}
+
+// Ticks returns the number of ticks required for the specified duration to
+// elapse. It is at least 1.
+func (w *TimerWheel) Ticks(d time.Duration) uint64 {
+	if d <= w.interval {
+		return 1
+	}
+	return uint64((d + w.interval - 1) / w.interval)
+}
+
+// Len returns the number of active timers.
+func (w *TimerWheel) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.count
+}
+
+// NewTimer returns an inactive timer invoking f once expired, it can be
+// armed using its Reset method.
+func (w *TimerWheel) NewTimer(f func()) *Timer {
+	return &Timer{wheel: w, f: f}
+}
+
+// AfterFunc registers a timer invoking f after the specified number of ticks.
+func (w *TimerWheel) AfterFunc(ticks uint64, f func()) *Timer {
+	t := w.NewTimer(f)
+	t.Reset(ticks)
+	return t
+}
+
+// Every registers a timer invoking f every specified number of ticks until
+// the returned timer is stopped.
+func (w *TimerWheel) Every(ticks uint64, f func()) *Timer {
+	if ticks == 0 {
+		ticks = 1
+	}
+	t := w.NewTimer(f)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	t.period = ticks
+	w.add(t, ticks)
+	return t
+}
+
+// Tick moves the wheel forward by one tick and invokes the callbacks of all
+// expired timers.
+func (w *TimerWheel) Tick() {
+	expired := w.advance()
+	for idx, t := range expired {
+		t.f()
+		expired[idx] = nil
+	}
+	w.mu.Lock()
+	if w.expired == nil {
+		w.expired = expired[:0]
+	}
+	w.mu.Unlock()
+}
+
+func (w *TimerWheel) advance() []*Timer {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.tick++
+	expired := w.expired
+	w.expired = nil
+	slot := w.tick & w.mask
+	for t := w.slots[slot]; t != nil; {
+		next := t.next
+		if t.expire <= w.tick {
+			w.remove(t)
+			expired = append(expired, t)
+			if t.period > 0 {
+				w.add(t, t.period)
+			}
+		}
+		t = next
+	}
+	return expired
+}
+
+func (w *TimerWheel) add(t *Timer, ticks uint64) {
+	if ticks == 0 {
+		ticks = 1
+	}
+	t.expire = w.tick + ticks
+	slot := t.expire & w.mask
+	t.prev = nil
+	t.next = w.slots[slot]
+	if t.next != nil {
+		t.next.prev = t
+	}
+	w.slots[slot] = t
+	t.active = true
+	w.count++
+}
+
+func (w *TimerWheel) remove(t *Timer) {
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		w.slots[t.expire&w.mask] = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.prev = nil
+	t.next = nil
+	t.active = false
+	w.count--
+}
@@ -0,0 +1,153 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimerWheelTicks(t *testing.T) {
+	w := NewTimerWheel(10*time.Millisecond, 8)
+	tests := []struct {
+		d     time.Duration
+		ticks uint64
+	}{
+		{0, 1},
+		{time.Millisecond, 1},
+		{10 * time.Millisecond, 1},
+		{11 * time.Millisecond, 2},
+		{time.Second, 100},
+	}
+	for idx, tt := range tests {
+		if v := w.Ticks(tt.d); v != tt.ticks {
+			t.Errorf("%d, ticks %d, want %d", idx, v, tt.ticks)
+		}
+	}
+}
+
+func TestTimerWheelTimersExpireOnTheirTick(t *testing.T) {
+	w := NewTimerWheel(time.Millisecond, 8)
+	fired := make(map[uint64]uint64)
+	tick := uint64(0)
+	// timers beyond the number of slots take multiple rounds to expire
+	for _, ticks := range []uint64{1, 3, 8, 9, 20} {
+		ticks := ticks
+		w.AfterFunc(ticks, func() { fired[ticks] = tick })
+	}
+	for tick = 1; tick <= 24; tick++ {
+		w.Tick()
+	}
+	for _, ticks := range []uint64{1, 3, 8, 9, 20} {
+		if fired[ticks] != ticks {
+			t.Errorf("timer of %d ticks fired on tick %d", ticks, fired[ticks])
+		}
+	}
+	if w.Len() != 0 {
+		t.Errorf("unexpected active timers %d", w.Len())
+	}
+}
+
+func TestTimerWheelTimerCanBeStoppedAndReset(t *testing.T) {
+	w := NewTimerWheel(time.Millisecond, 8)
+	count := 0
+	timer := w.AfterFunc(2, func() { count++ })
+	if !timer.Stop() || timer.Stop() {
+		t.Fatalf("unexpected stop result")
+	}
+	w.Tick()
+	w.Tick()
+	if count != 0 {
+		t.Fatalf("stopped timer fired")
+	}
+	if timer.Reset(1) {
+		t.Errorf("stopped timer reported as active")
+	}
+	if !timer.Reset(3) {
+		t.Errorf("armed timer reported as inactive")
+	}
+	for i := 0; i < 2; i++ {
+		w.Tick()
+	}
+	if count != 0 {
+		t.Fatalf("reset timer fired early")
+	}
+	w.Tick()
+	if count != 1 || w.Len() != 0 {
+		t.Errorf("count %d, active %d", count, w.Len())
+	}
+}
+
+func TestTimerWheelPeriodicTimer(t *testing.T) {
+	w := NewTimerWheel(time.Millisecond, 4)
+	count := 0
+	timer := w.Every(3, func() { count++ })
+	for i := 0; i < 12; i++ {
+		w.Tick()
+	}
+	if count != 4 {
+		t.Errorf("count %d, want 4", count)
+	}
+	timer.Stop()
+	for i := 0; i < 12; i++ {
+		w.Tick()
+	}
+	if count != 4 || w.Len() != 0 {
+		t.Errorf("count %d, active %d", count, w.Len())
+	}
+}
+
+func TestTimerWheelCallbackCanResetItsTimer(t *testing.T) {
+	w := NewTimerWheel(time.Millisecond, 8)
+	count := 0
+	var timer *Timer
+	timer = w.NewTimer(func() {
+		count++
+		if count < 3 {
+			timer.Reset(2)
+		}
+	})
+	timer.Reset(2)
+	for i := 0; i < 10; i++ {
+		w.Tick()
+	}
+	if count != 3 {
+		t.Errorf("count %d, want 3", count)
+	}
+}
+
+// BenchmarkTimerWheelMillionDeadlines registers and cancels a million
+// deadlines spread over the wheel in each iteration.
+func BenchmarkTimerWheelMillionDeadlines(b *testing.B) {
+	const count = 1000000
+	w := NewTimerWheel(time.Millisecond, defaultTimerWheelSlots)
+	timers := make([]*Timer, count)
+	f := func() {}
+	for i := range timers {
+		timers[i] = w.NewTimer(f)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j, timer := range timers {
+			timer.Reset(uint64(j%30000) + 1)
+		}
+		for _, timer := range timers {
+			timer.Stop()
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*count),
+		"ns/deadline")
+}
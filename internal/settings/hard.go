@@ -82,6 +82,24 @@ const (
 
 	// SnapshotHeaderSize defines the snapshot header size in number of bytes.
 	SnapshotHeaderSize uint64 = 1024
+	// MaxMembers is the max number of replicas, including voting, non-voting
+	// and witness replicas, in the membership of a raft shard.
+	MaxMembers uint64 = 256
+	// MaxAddressLength is the max length in bytes of each replica address in
+	// the membership of a raft shard.
+	MaxAddressLength uint64 = 512
+	// MaxRemovedReplicas is the max number of removed replica IDs that can be
+	// kept in the membership of a raft shard, see the MaxRemovedReplicas field
+	// of config.Config.
+	MaxRemovedReplicas uint64 = 4096
+	// MaxChunkStreams is the max number of chunked proposals that can be
+	// concurrently reassembled by each raft shard, the least recently active
+	// one is discarded when a new chunked proposal would exceed the limit. See
+	// the MaxEntryChunkBytes field of config.Config.
+	MaxChunkStreams uint64 = 64
+	// ChunkStreamTTLEntries is the number of Raft log entries after which a
+	// chunked proposal with no further chunk applied is discarded.
+	ChunkStreamTTLEntries uint64 = 100000
 
 	//
 	// transport
@@ -95,6 +113,9 @@ const (
 	MaxMessageBatchSize uint64 = LargeEntitySize
 	// SnapshotChunkSize is the snapshot chunk size.
 	SnapshotChunkSize uint64 = 2 * 1024 * 1024
+	// MaxSnapshotFileChunkCount is the max number of chunks accepted for each
+	// received snapshot file, it limits each snapshot file to 2TBytes.
+	MaxSnapshotFileChunkCount uint64 = 1024 * 1024
 )
 
 // HardHash returns the hash value of the Hard setting.
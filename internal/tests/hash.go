@@ -0,0 +1,98 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// HashState is the state of HashStateMachine returned by its Lookup method.
+type HashState struct {
+	Count uint64
+	Hash  uint64
+}
+
+// HashStateMachine is a IStateMachine struct used for testing purpose. Its
+// state is the number of applied entries and the hash of all applied commands
+// so replicas can be compared once they converge. The hash is also reported
+// as the fingerprint of the state machine so divergence between replicas can
+// be detected from snapshots.
+type HashStateMachine struct {
+	state HashState
+}
+
+var _ sm.IStateMachine = (*HashStateMachine)(nil)
+var _ sm.IFingerprint = (*HashStateMachine)(nil)
+
+// NewHashStateMachine creates and returns a new HashStateMachine instance.
+func NewHashStateMachine(shardID uint64, replicaID uint64) sm.IStateMachine {
+	return &HashStateMachine{}
+}
+
+// Update updates the state machine.
+func (s *HashStateMachine) Update(e sm.Entry) (sm.Result, error) {
+	h := fnv.New64a()
+	var v [8]byte
+	binary.LittleEndian.PutUint64(v[:], s.state.Hash)
+	h.Write(v[:])
+	h.Write(e.Cmd)
+	s.state.Hash = h.Sum64()
+	s.state.Count++
+	return sm.Result{Value: s.state.Count}, nil
+}
+
+// Lookup returns the HashState of the state machine.
+func (s *HashStateMachine) Lookup(query interface{}) (interface{}, error) {
+	return s.state, nil
+}
+
+// Fingerprint returns the hash of all applied commands.
+func (s *HashStateMachine) Fingerprint() (uint64, error) {
+	if s.state.Count == 0 {
+		return 0, nil
+	}
+	return s.state.Hash, nil
+}
+
+// SaveSnapshot saves the state of the state machine.
+func (s *HashStateMachine) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	var data [16]byte
+	binary.LittleEndian.PutUint64(data[:], s.state.Count)
+	binary.LittleEndian.PutUint64(data[8:], s.state.Hash)
+	_, err := w.Write(data[:])
+	return err
+}
+
+// RecoverFromSnapshot recovers the state of the state machine from snapshot.
+func (s *HashStateMachine) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	var data [16]byte
+	if _, err := io.ReadFull(r, data[:]); err != nil {
+		return err
+	}
+	s.state.Count = binary.LittleEndian.Uint64(data[:])
+	s.state.Hash = binary.LittleEndian.Uint64(data[8:])
+	return nil
+}
+
+// Close closes the state machine.
+func (s *HashStateMachine) Close() error {
+	return nil
+}
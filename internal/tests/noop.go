@@ -98,3 +98,54 @@ func (n *NoOP) Close() error { return nil }
 func (n *NoOP) GetHash() (uint64, error) {
 	return 0, nil
 }
+
+// ConcurrentNoOP is a IConcurrentStateMachine struct used for testing purpose.
+type ConcurrentNoOP struct {
+	UpdateCount uint64
+}
+
+// Update updates the object.
+func (n *ConcurrentNoOP) Update(ents []sm.Entry) ([]sm.Entry, error) {
+	for i := range ents {
+		ents[i].Result = sm.Result{Value: uint64(len(ents[i].Cmd))}
+	}
+	n.UpdateCount += uint64(len(ents))
+	return ents, nil
+}
+
+// Lookup locally looks up the data.
+func (n *ConcurrentNoOP) Lookup(key interface{}) (interface{}, error) {
+	return n.UpdateCount, nil
+}
+
+// PrepareSnapshot prepares snapshotting.
+func (n *ConcurrentNoOP) PrepareSnapshot() (interface{}, error) {
+	return nil, nil
+}
+
+// SaveSnapshot saves the state of the object to the provided io.Writer object.
+func (n *ConcurrentNoOP) SaveSnapshot(ctx interface{}, w io.Writer,
+	fileCollection sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	return nil
+}
+
+// RecoverFromSnapshot recovers the object from the snapshot specified by the
+// io.Reader object.
+func (n *ConcurrentNoOP) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	return nil
+}
+
+// Close closes the ConcurrentNoOP IConcurrentStateMachine.
+func (n *ConcurrentNoOP) Close() error { return nil }
+
+// NonRetainingConcurrentNoOP is a ConcurrentNoOP that never retains the Cmd
+// of applied entries.
+type NonRetainingConcurrentNoOP struct {
+	ConcurrentNoOP
+}
+
+var _ sm.INonRetainingStateMachine = (*NonRetainingConcurrentNoOP)(nil)
+
+// NonRetaining marks the state machine as non-retaining.
+func (n *NonRetainingConcurrentNoOP) NonRetaining() {}
@@ -15,8 +15,10 @@
 package transport
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"strings"
 	"sync"
 	"sync/atomic"
 
@@ -36,7 +38,11 @@ import (
 var (
 	// ErrSnapshotOutOfDate is returned when the snapshot being received is
 	// considered as out of date.
-	ErrSnapshotOutOfDate     = errors.New("snapshot is out of date")
+	ErrSnapshotOutOfDate = errors.New("snapshot is out of date")
+	// ErrInvalidSnapshotChunk is returned when the received snapshot chunk is
+	// malformed.
+	ErrInvalidSnapshotChunk  = errors.New("invalid snapshot chunk")
+	maxFileChunkCount        = settings.MaxSnapshotFileChunkCount
 	gcIntervalTick           = settings.Soft.SnapshotGCTick
 	snapshotChunkTimeoutTick = settings.Soft.SnapshotChunkTimeoutTick
 	maxConcurrentSlot        = settings.Soft.MaxConcurrentStreamingSnapshot
@@ -52,8 +58,12 @@ type tracked struct {
 	validator *rsm.SnapshotValidator
 	files     []*pb.SnapshotFile
 	first     pb.Chunk
+	file      string
 	tick      uint64
 	next      uint64
+	nextFile  uint64
+	received  uint64
+	total     uint64
 }
 
 type ssLock struct {
@@ -68,20 +78,32 @@ func (l *ssLock) unlock() {
 	l.mu.Unlock()
 }
 
+// ISnapshotReceiveEvent is the interface for notifying the status of
+// snapshots being received.
+type ISnapshotReceiveEvent interface {
+	SnapshotReceiveStarted(raftio.SnapshotInfo)
+	SnapshotReceiveProgress(raftio.SnapshotProgressInfo)
+	SnapshotReceiveAborted(raftio.SnapshotAbortInfo)
+}
+
 // Chunk managed on the receiving side
 type Chunk struct {
-	fs        vfs.IFS
-	tracked   map[string]*tracked
-	locks     map[string]*ssLock
-	dir       server.SnapshotDirFunc
-	confirm   func(uint64, uint64, uint64)
-	onReceive func(pb.MessageBatch)
-	timeout   uint64
-	did       uint64
-	tick      uint64
-	gcTick    uint64
-	mu        sync.Mutex
-	validate  bool
+	ctx        context.Context
+	sideloader raftio.ISnapshotSideloader
+	events     ISnapshotReceiveEvent
+	fs         vfs.IFS
+	staging    *server.StagingSpace
+	tracked    map[string]*tracked
+	locks      map[string]*ssLock
+	dir        server.SnapshotDirFunc
+	confirm    func(uint64, uint64, uint64)
+	onReceive  func(pb.MessageBatch)
+	timeout    uint64
+	did        uint64
+	tick       uint64
+	gcTick     uint64
+	mu         sync.Mutex
+	validate   bool
 }
 
 // NewChunk creates and returns a new snapshot chunks instance.
@@ -89,6 +111,7 @@ func NewChunk(onReceive func(pb.MessageBatch),
 	confirm func(uint64, uint64, uint64), dir server.SnapshotDirFunc,
 	did uint64, fs vfs.IFS) *Chunk {
 	return &Chunk{
+		ctx:       context.Background(),
 		did:       did,
 		validate:  true,
 		onReceive: onReceive,
@@ -110,6 +133,10 @@ func (c *Chunk) Add(chunk pb.Chunk) bool {
 			chunk.DeploymentId, c.did, chunk.BinVer, raftio.TransportBinVersion)
 		return false
 	}
+	if err := checkChunk(c.fs, chunk); err != nil {
+		plog.Errorf("dropped a chunk from %d, %v", chunk.From, err)
+		return false
+	}
 	key := chunkKey(chunk)
 	lock := c.getSnapshotLock(key)
 	lock.lock()
@@ -117,6 +144,56 @@ func (c *Chunk) Add(chunk pb.Chunk) bool {
 	return c.addLocked(chunk)
 }
 
+// checkChunk checks the ids, counts and file paths of a chunk received from
+// the network before they are used for tracking and saving the chunk.
+func checkChunk(fs vfs.IFS, chunk pb.Chunk) error {
+	if chunk.IsAbortChunk() {
+		return nil
+	}
+	if chunk.IsPoisonChunk() {
+		return errors.Wrapf(ErrInvalidSnapshotChunk, "unexpected poison chunk")
+	}
+	if chunk.ChunkCount != 0 && chunk.ChunkCount != pb.LastChunkCount &&
+		chunk.ChunkId >= chunk.ChunkCount {
+		return errors.Wrapf(ErrInvalidSnapshotChunk,
+			"chunk id %d, chunk count %d", chunk.ChunkId, chunk.ChunkCount)
+	}
+	if chunk.FileChunkId >= maxFileChunkCount {
+		return errors.Wrapf(ErrInvalidSnapshotChunk,
+			"file chunk id %d", chunk.FileChunkId)
+	}
+	if chunk.FileChunkCount != pb.LastChunkCount {
+		if chunk.FileChunkCount > maxFileChunkCount {
+			return errors.Wrapf(ErrInvalidSnapshotChunk,
+				"file chunk count %d", chunk.FileChunkCount)
+		}
+		if chunk.FileChunkCount != 0 &&
+			chunk.FileChunkId >= chunk.FileChunkCount {
+			return errors.Wrapf(ErrInvalidSnapshotChunk,
+				"file chunk id %d, file chunk count %d",
+				chunk.FileChunkId, chunk.FileChunkCount)
+		}
+	}
+	if !isValidChunkFilepath(fs, chunk.Filepath) {
+		return errors.Wrapf(ErrInvalidSnapshotChunk,
+			"filepath %q", chunk.Filepath)
+	}
+	if chunk.HasFileInfo && !isValidChunkFilepath(fs, chunk.FileInfo.Filepath) {
+		return errors.Wrapf(ErrInvalidSnapshotChunk,
+			"file info filepath %q", chunk.FileInfo.Filepath)
+	}
+	return nil
+}
+
+// isValidChunkFilepath returns a boolean value indicating whether the base
+// name of the specified path can be used as a file name in the temp snapshot
+// directory.
+func isValidChunkFilepath(fs vfs.IFS, fp string) bool {
+	fn := fs.PathBase(fp)
+	return fn != "" && fn != "." && fn != ".." &&
+		!strings.ContainsAny(fn, "/\\")
+}
+
 // Tick moves the internal logical clock forward.
 func (c *Chunk) Tick() {
 	ct := atomic.AddUint64(&c.tick, 1)
@@ -135,6 +212,7 @@ func (c *Chunk) Close() {
 			defer l.unlock()
 			c.removeTempDir(td.first)
 			c.reset(key)
+			c.receiveAborted(td.first, "transport closed")
 		}()
 	}
 }
@@ -150,6 +228,7 @@ func (c *Chunk) gc() {
 			if tick-td.tick >= c.timeout {
 				c.removeTempDir(td.first)
 				c.reset(key)
+				c.receiveAborted(td.first, "timeout")
 			}
 		}()
 	}
@@ -201,6 +280,11 @@ func (c *Chunk) record(chunk pb.Chunk) *tracked {
 	td := c.tracked[key]
 	if chunk.ChunkId == 0 {
 		plog.Debugf("first chunk of %s received", c.ssid(chunk))
+		if chunk.FileChunkId != 0 {
+			plog.Errorf("unexpected first chunk %s, file chunk id %d",
+				key, chunk.FileChunkId)
+			return nil
+		}
 		if td != nil {
 			plog.Warningf("removing unclaimed chunks %s", key)
 			c.removeTempDir(td.first)
@@ -209,6 +293,11 @@ func (c *Chunk) record(chunk pb.Chunk) *tracked {
 				plog.Errorf("max slot count reached, dropped a chunk %s", key)
 				return nil
 			}
+			if c.staging.Full() {
+				plog.Warningf("snapshot staging space is full, dropped a chunk %s",
+					key)
+				return nil
+			}
 		}
 		validator := rsm.NewSnapshotValidator()
 		if c.validate && !chunk.HasFileInfo {
@@ -221,6 +310,7 @@ func (c *Chunk) record(chunk pb.Chunk) *tracked {
 			first:     chunk,
 			validator: validator,
 			files:     make([]*pb.SnapshotFile, 0),
+			total:     chunk.FileSize,
 		}
 		c.tracked[key] = td
 	} else {
@@ -241,10 +331,21 @@ func (c *Chunk) record(chunk pb.Chunk) *tracked {
 			plog.Errorf("ignored %s, from %d, want %d", key, from, want)
 			return nil
 		}
+		if chunk.FileChunkId != 0 &&
+			(chunk.FileChunkId != td.nextFile || chunk.Filepath != td.file) {
+			plog.Errorf("out of order, %s, file %s, want %d, got %d",
+				key, chunk.Filepath, td.nextFile, chunk.FileChunkId)
+			return nil
+		}
 		td.next = chunk.ChunkId + 1
 	}
+	if chunk.FileChunkId == 0 {
+		td.file = chunk.Filepath
+	}
+	td.nextFile = chunk.FileChunkId + 1
 	if chunk.FileChunkId == 0 && chunk.HasFileInfo {
 		td.files = append(td.files, &chunk.FileInfo)
+		td.total += chunk.FileSize
 	}
 	td.tick = c.getTick()
 	return td
@@ -255,12 +356,22 @@ func (c *Chunk) shouldValidate(chunk pb.Chunk) bool {
 }
 
 func (c *Chunk) addLocked(chunk pb.Chunk) bool {
+	if chunk.IsAbortChunk() {
+		c.abort(chunk)
+		return true
+	}
+	if chunk.IsSideloaded() {
+		return c.sideload(chunk)
+	}
 	key := chunkKey(chunk)
 	td := c.record(chunk)
 	if td == nil {
 		plog.Warningf("ignored a chunk belongs to %s", key)
 		return false
 	}
+	if chunk.ChunkId == 0 {
+		c.receiveStarted(chunk)
+	}
 	removed, err := c.nodeRemoved(chunk)
 	if err != nil {
 		panicNow(err)
@@ -268,34 +379,51 @@ func (c *Chunk) addLocked(chunk pb.Chunk) bool {
 	if removed {
 		c.removeTempDir(chunk)
 		plog.Warningf("node removed, ignored chunk %s", key)
+		c.receiveAborted(chunk, "node removed")
 		return false
 	}
 	if c.shouldValidate(chunk) {
 		if !td.validator.AddChunk(chunk.Data, chunk.ChunkId) {
 			plog.Warningf("ignored a invalid chunk %s", key)
+			c.receiveAborted(chunk, "invalid chunk")
 			return false
 		}
 	}
 	if err := c.save(chunk); err != nil {
 		err = errors.Wrapf(err, "failed to save chunk %s", key)
 		c.removeTempDir(chunk)
+		if server.IsNoSpace(err) {
+			plog.Errorf("%s aborted, %v", c.ssid(chunk), err)
+			c.reset(key)
+			c.receiveAborted(chunk, "no space left")
+			return false
+		}
 		panicNow(err)
 	}
+	td.received += uint64(len(chunk.Data))
+	c.receiveProgress(chunk, td)
 	if chunk.IsLastChunk() {
 		plog.Debugf("last chunk %s received", key)
 		defer c.reset(key)
 		if c.validate {
-			if !td.validator.Validate() {
+			if !td.validator.Validate() || !c.validateExternalFiles(chunk, td) {
 				plog.Warningf("dropped an invalid snapshot %s", key)
 				c.removeTempDir(chunk)
+				c.receiveAborted(chunk, "invalid snapshot")
 				return false
 			}
 		}
 		if err := c.finalize(chunk, td); err != nil {
 			c.removeTempDir(chunk)
+			if server.IsNoSpace(err) {
+				plog.Errorf("%s aborted when finalizing, %v", c.ssid(chunk), err)
+				c.receiveAborted(chunk, "no space left")
+				return false
+			}
 			if !errors.Is(err, ErrSnapshotOutOfDate) {
 				plog.Panicf("%s failed when finalizing, %v", key, err)
 			}
+			c.receiveAborted(chunk, "snapshot out of date")
 			return false
 		}
 		snapshotMessage := c.toMessage(td.first, td.files)
@@ -307,6 +435,155 @@ func (c *Chunk) addLocked(chunk pb.Chunk) bool {
 	return true
 }
 
+// abort discards the partially received snapshot once the sender aborted it.
+func (c *Chunk) abort(chunk pb.Chunk) {
+	key := chunkKey(chunk)
+	c.mu.Lock()
+	td, ok := c.tracked[key]
+	c.mu.Unlock()
+	if !ok || td.first.From != chunk.From {
+		return
+	}
+	plog.Infof("snapshot %s aborted by %d", key, chunk.From)
+	c.removeTempDir(td.first)
+	c.reset(key)
+	c.receiveAborted(td.first, "aborted by sender")
+}
+
+func (c *Chunk) receiveStarted(chunk pb.Chunk) {
+	if c.events != nil {
+		c.events.SnapshotReceiveStarted(raftio.SnapshotInfo{
+			ShardID:   chunk.ShardID,
+			ReplicaID: chunk.ReplicaID,
+			From:      chunk.From,
+			Index:     chunk.Index,
+		})
+	}
+}
+
+func (c *Chunk) receiveProgress(chunk pb.Chunk, td *tracked) {
+	if c.events != nil {
+		c.events.SnapshotReceiveProgress(raftio.SnapshotProgressInfo{
+			ShardID:       chunk.ShardID,
+			ReplicaID:     chunk.ReplicaID,
+			From:          chunk.From,
+			Index:         chunk.Index,
+			ReceivedBytes: td.received,
+			TotalBytes:    td.total,
+		})
+	}
+}
+
+func (c *Chunk) receiveAborted(chunk pb.Chunk, reason string) {
+	if c.events != nil {
+		c.events.SnapshotReceiveAborted(raftio.SnapshotAbortInfo{
+			ShardID:   chunk.ShardID,
+			ReplicaID: chunk.ReplicaID,
+			From:      chunk.From,
+			Index:     chunk.Index,
+			Reason:    reason,
+		})
+	}
+}
+
+func (c *Chunk) sideload(chunk pb.Chunk) bool {
+	key := chunkKey(chunk)
+	if c.sideloader == nil || chunk.ChunkId != 0 || !chunk.IsLastChunk() {
+		plog.Warningf("ignored a sideloaded snapshot %s", key)
+		return false
+	}
+	removed, err := c.nodeRemoved(chunk)
+	if err != nil {
+		panicNow(err)
+	}
+	if removed {
+		plog.Warningf("node removed, ignored sideloaded snapshot %s", key)
+		return false
+	}
+	if c.staging.Full() {
+		plog.Warningf("snapshot staging space is full, ignored sideloaded "+
+			"snapshot %s", key)
+		return false
+	}
+	if err := c.fetch(chunk); err != nil {
+		plog.Errorf("failed to fetch sideloaded snapshot %s, %v", key, err)
+		c.removeTempDir(chunk)
+		return false
+	}
+	if c.validate && !c.validateFile(chunk) {
+		plog.Warningf("dropped an invalid sideloaded snapshot %s", key)
+		c.removeTempDir(chunk)
+		return false
+	}
+	td := &tracked{first: chunk, files: make([]*pb.SnapshotFile, 0)}
+	if err := c.finalize(chunk, td); err != nil {
+		c.removeTempDir(chunk)
+		if server.IsNoSpace(err) {
+			plog.Errorf("%s aborted when finalizing, %v", c.ssid(chunk), err)
+			return false
+		}
+		if !errors.Is(err, ErrSnapshotOutOfDate) {
+			plog.Panicf("%s failed when finalizing, %v", key, err)
+		}
+		return false
+	}
+	plog.Debugf("%s sideloaded from %d, term %d",
+		c.ssid(chunk), chunk.From, chunk.Term)
+	c.onReceive(c.toMessage(chunk, td.files))
+	c.confirm(chunk.ShardID, chunk.ReplicaID, chunk.From)
+	return true
+}
+
+func (c *Chunk) getTempFilepath(chunk pb.Chunk) string {
+	env := c.getEnv(chunk)
+	return c.fs.PathJoin(env.GetTempDir(), c.fs.PathBase(chunk.Filepath))
+}
+
+func (c *Chunk) fetch(chunk pb.Chunk) (err error) {
+	env := c.getEnv(chunk)
+	if err := env.CreateTempDir(); err != nil {
+		return err
+	}
+	f, err := createChunkFile(c.getTempFilepath(chunk), c.fs)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, f.close())
+	}()
+	w := c.staging.Writer(env.GetTempDir(), f.file)
+	if err := c.sideloader.Fetch(c.ctx, chunk.Locator, w); err != nil {
+		return err
+	}
+	return f.sync()
+}
+
+// validateFile checks the fetched snapshot file using its checksums, the file
+// is checked in the same way as the streamed snapshot chunks.
+func (c *Chunk) validateFile(chunk pb.Chunk) bool {
+	err := rsm.VerifySnapshotImage(c.getTempFilepath(chunk),
+		chunk.FileSize, nil, true, c.fs)
+	if err != nil {
+		plog.Warningf("%s failed validation, %v", c.ssid(chunk), err)
+		return false
+	}
+	return true
+}
+
+// validateExternalFiles checks the received external snapshot files using
+// their recorded sizes and checksums.
+func (c *Chunk) validateExternalFiles(chunk pb.Chunk, td *tracked) bool {
+	env := c.getEnv(chunk)
+	for _, f := range td.files {
+		fp := c.fs.PathJoin(env.GetTempDir(), c.fs.PathBase(f.Filepath))
+		if err := rsm.VerifySnapshotFile(fp, f, true, c.fs); err != nil {
+			plog.Warningf("%s failed validation, %v", c.ssid(chunk), err)
+			return false
+		}
+	}
+	return true
+}
+
 func (c *Chunk) nodeRemoved(chunk pb.Chunk) (bool, error) {
 	env := c.getEnv(chunk)
 	dir := env.GetRootDir()
@@ -335,6 +612,7 @@ func (c *Chunk) save(chunk pb.Chunk) (err error) {
 		err = firstError(err, f.close())
 	}()
 	n, err := f.write(chunk.Data)
+	c.staging.Add(env.GetTempDir(), uint64(n))
 	if err != nil {
 		return err
 	}
@@ -349,6 +627,33 @@ func (c *Chunk) save(chunk pb.Chunk) (err error) {
 	return nil
 }
 
+// Sync fsyncs the snapshot file the specified chunk was saved to. Files are
+// always fsynced once fully received, it is thus a no-op for the last chunk of
+// each file or when the snapshot is no longer being received.
+func (c *Chunk) Sync(chunk pb.Chunk) (err error) {
+	if chunk.IsAbortChunk() || chunk.IsSideloaded() ||
+		chunk.IsLastChunk() || chunk.IsLastFileChunk() {
+		return nil
+	}
+	key := chunkKey(chunk)
+	lock := c.getSnapshotLock(key)
+	lock.lock()
+	defer lock.unlock()
+	if _, ok := c.getTracked()[key]; !ok {
+		return nil
+	}
+	env := c.getEnv(chunk)
+	fn := c.fs.PathBase(chunk.Filepath)
+	f, err := openChunkFileForAppend(c.fs.PathJoin(env.GetTempDir(), fn), c.fs)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, f.close())
+	}()
+	return f.sync()
+}
+
 func (c *Chunk) getEnv(chunk pb.Chunk) server.SSEnv {
 	return server.NewSSEnv(c.dir, chunk.ShardID, chunk.ReplicaID,
 		chunk.Index, chunk.From, server.ReceivingMode, c.fs)
@@ -361,7 +666,13 @@ func (c *Chunk) finalize(chunk pb.Chunk, td *tracked) error {
 		panic("invalid message")
 	}
 	ss := &msg.Requests[0].Snapshot
+	if err := env.SaveSSMetadata(ss); err != nil {
+		return err
+	}
 	err := env.FinalizeSnapshot(ss)
+	if err == nil {
+		c.staging.Release(env.GetTempDir())
+	}
 	if err == server.ErrSnapshotOutOfDate {
 		return ErrSnapshotOutOfDate
 	}
@@ -371,6 +682,7 @@ func (c *Chunk) finalize(chunk pb.Chunk, td *tracked) error {
 func (c *Chunk) removeTempDir(chunk pb.Chunk) {
 	env := c.getEnv(chunk)
 	env.MustRemoveTempDir()
+	c.staging.Release(env.GetTempDir())
 }
 
 func (c *Chunk) toMessage(chunk pb.Chunk,
@@ -394,6 +706,7 @@ func (c *Chunk) toMessage(chunk pb.Chunk,
 	s.Filepath = c.fs.PathJoin(snapDir, fn)
 	s.FileSize = chunk.FileSize
 	s.Witness = chunk.Witness
+	s.Fingerprint = chunk.Fingerprint
 	m.Snapshot = s
 	m.Snapshot.Files = files
 	for idx := range m.Snapshot.Files {
@@ -16,13 +16,20 @@ package transport
 
 import (
 	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
 	"reflect"
+	"sync/atomic"
+	"syscall"
 	"testing"
 
+	"github.com/cockroachdb/errors"
 	"github.com/lni/goutils/leaktest"
 
 	"github.com/lni/dragonboat/v4/internal/fileutil"
 	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
 	"github.com/lni/dragonboat/v4/internal/settings"
 	"github.com/lni/dragonboat/v4/internal/vfs"
 	"github.com/lni/dragonboat/v4/raftio"
@@ -304,6 +311,40 @@ func TestGcRemovesRecordAndTempFile(t *testing.T) {
 	runChunkTest(t, fn, fs)
 }
 
+func TestAbortChunkRemovesRecordAndTempFile(t *testing.T) {
+	fn := func(t *testing.T, chunks *Chunk, handler *testMessageHandler) {
+		inputs := getTestChunk()
+		chunks.validate = false
+		if !chunks.addLocked(inputs[0]) {
+			t.Fatalf("failed to add chunk")
+		}
+		abort := inputs[1]
+		abort.From = inputs[0].From + 1
+		abort.ChunkCount = pb.AbortChunkCount
+		if !chunks.addLocked(abort) {
+			t.Fatalf("failed to add the abort chunk")
+		}
+		if _, ok := chunks.tracked[chunkKey(inputs[0])]; !ok {
+			t.Fatalf("snapshot aborted by another node")
+		}
+		abort.From = inputs[0].From
+		if !chunks.addLocked(abort) {
+			t.Fatalf("failed to add the abort chunk")
+		}
+		if _, ok := chunks.tracked[chunkKey(inputs[0])]; ok {
+			t.Errorf("failed to remove the record")
+		}
+		if hasSnapshotTempFile(chunks, inputs[0]) {
+			t.Errorf("failed to remove temp file")
+		}
+		if handler.getSnapshotCount(100, 2) != 0 {
+			t.Errorf("got %d, want %d", handler.getSnapshotCount(100, 2), 0)
+		}
+	}
+	fs := vfs.GetTestFS()
+	runChunkTest(t, fn, fs)
+}
+
 func TestReceivedCompleteChunkWillBeMergedIntoSnapshotFile(t *testing.T) {
 	fn := func(t *testing.T, chunks *Chunk, handler *testMessageHandler) {
 		inputs := getTestChunk()
@@ -328,6 +369,110 @@ func TestReceivedCompleteChunkWillBeMergedIntoSnapshotFile(t *testing.T) {
 	runChunkTest(t, fn, fs)
 }
 
+// noSpaceFS is a vfs.IFS failing writes with ENOSPC once full is set.
+type noSpaceFS struct {
+	vfs.IFS
+	full atomic.Bool
+}
+
+func (fs *noSpaceFS) Create(name string) (vfs.File, error) {
+	f, err := fs.IFS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &noSpaceFile{File: f, fs: fs}, nil
+}
+
+func (fs *noSpaceFS) OpenForAppend(name string) (vfs.File, error) {
+	f, err := fs.IFS.OpenForAppend(name)
+	if err != nil {
+		return nil, err
+	}
+	return &noSpaceFile{File: f, fs: fs}, nil
+}
+
+type noSpaceFile struct {
+	vfs.File
+	fs *noSpaceFS
+}
+
+func (f *noSpaceFile) Write(data []byte) (int, error) {
+	if f.fs.full.Load() {
+		return 0, &os.PathError{Op: "write", Path: "chunk", Err: syscall.ENOSPC}
+	}
+	return f.File.Write(data)
+}
+
+func TestNoSpaceAbortsSnapshotBeingReceived(t *testing.T) {
+	fn := func(t *testing.T, chunks *Chunk, handler *testMessageHandler) {
+		fs := &noSpaceFS{IFS: chunks.fs}
+		chunks.fs = fs
+		chunks.staging = server.NewStagingSpace(0)
+		inputs := getTestChunk()
+		chunks.validate = false
+		if !chunks.addLocked(inputs[0]) {
+			t.Fatalf("failed to add chunk")
+		}
+		if s := chunks.staging.Stats(); s.Bytes != uint64(len(inputs[0].Data)) {
+			t.Errorf("unexpected stats %+v", s)
+		}
+		fs.full.Store(true)
+		if chunks.addLocked(inputs[1]) {
+			t.Fatalf("chunk unexpectedly added")
+		}
+		if _, ok := chunks.tracked[chunkKey(inputs[0])]; ok {
+			t.Errorf("failed to remove the record")
+		}
+		if hasSnapshotTempFile(chunks, inputs[0]) {
+			t.Errorf("failed to remove temp file")
+		}
+		if s := chunks.staging.Stats(); s.Bytes != 0 {
+			t.Errorf("unexpected stats %+v", s)
+		}
+		// the snapshot can be received again once space is available
+		fs.full.Store(false)
+		for _, c := range inputs {
+			if !chunks.addLocked(c) {
+				t.Fatalf("failed to add chunk")
+			}
+		}
+		if handler.getSnapshotCount(100, 2) != 1 {
+			t.Errorf("got %d, want %d", handler.getSnapshotCount(100, 2), 1)
+		}
+	}
+	fs := vfs.GetTestFS()
+	runChunkTest(t, fn, fs)
+}
+
+func TestSnapshotIsRejectedWhenStagingSpaceIsFull(t *testing.T) {
+	fn := func(t *testing.T, chunks *Chunk, handler *testMessageHandler) {
+		chunks.staging = server.NewStagingSpace(1)
+		chunks.staging.Add("other", 1)
+		inputs := getTestChunk()
+		chunks.validate = false
+		if chunks.addLocked(inputs[0]) {
+			t.Fatalf("chunk unexpectedly added")
+		}
+		if _, ok := chunks.tracked[chunkKey(inputs[0])]; ok {
+			t.Errorf("unexpectedly recorded")
+		}
+		chunks.staging.Release("other")
+		for _, c := range inputs {
+			if !chunks.addLocked(c) {
+				t.Fatalf("failed to add chunk")
+			}
+		}
+		if handler.getSnapshotCount(100, 2) != 1 {
+			t.Errorf("got %d, want %d", handler.getSnapshotCount(100, 2), 1)
+		}
+		if s := chunks.staging.Stats(); s.Bytes != 0 || s.Deferred != 1 {
+			t.Errorf("unexpected stats %+v", s)
+		}
+	}
+	fs := vfs.GetTestFS()
+	runChunkTest(t, fn, fs)
+}
+
 func TestChunkAreIgnoredWhenNodeIsRemoved(t *testing.T) {
 	fn := func(t *testing.T, chunks *Chunk, handler *testMessageHandler) {
 		inputs := getTestChunk()
@@ -543,45 +688,99 @@ func TestSnapshotWithExternalFilesAreHandledByChunk(t *testing.T) {
 	testSnapshotWithExternalFilesAreHandledByChunk(t, false, 1, fs)
 }
 
-func TestWitnessSnapshotCanBeHandled(t *testing.T) {
+func TestCorruptedExternalFileIsRejected(t *testing.T) {
 	fn := func(t *testing.T, chunks *Chunk, handler *testMessageHandler) {
-		ss := pb.Snapshot{
-			Filepath: "",
-			FileSize: 0,
-			Index:    100,
-			Term:     200,
-			Files:    nil,
-			Dummy:    false,
-			Witness:  true,
-		}
-		msg := pb.Message{
-			Type:     pb.InstallSnapshot,
-			To:       2,
-			From:     1,
-			ShardID:  100,
-			Snapshot: ss,
+		chunk := getTestChunk()[0]
+		env := chunks.getEnv(chunk)
+		if err := env.CreateTempDir(); err != nil {
+			t.Fatalf("failed to create temp dir %v", err)
+		}
+		sf := &pb.SnapshotFile{Filepath: "/data/external-file-1", FileId: 1}
+		write := func(data []byte) {
+			fp := chunks.fs.PathJoin(env.GetTempDir(), "external-file-1")
+			f, err := chunks.fs.Create(fp)
+			if err != nil {
+				t.Fatalf("failed to create file %v", err)
+			}
+			if _, err := f.Write(data); err != nil {
+				t.Fatalf("failed to write %v", err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatalf("failed to close %v", err)
+			}
+			if sf.Checksum == nil {
+				sf.FileSize = uint64(len(data))
+				sf.Checksum, err = rsm.GetFileChecksum(fp, chunks.fs)
+				if err != nil {
+					t.Fatalf("failed to get checksum %v", err)
+				}
+			}
 		}
-		inputs, err := splitSnapshotMessage(msg, chunks.fs)
-		if err != nil {
-			t.Fatalf("failed to get chunks %v", err)
+		td := &tracked{files: []*pb.SnapshotFile{sf}}
+		write([]byte("external-file-data"))
+		if !chunks.validateExternalFiles(chunk, td) {
+			t.Errorf("valid external file rejected")
 		}
-		if len(inputs) != 1 {
-			t.Errorf("got %d chunks, want 1", len(inputs))
+		write([]byte("external-file-DATA"))
+		if chunks.validateExternalFiles(chunk, td) {
+			t.Errorf("corrupted external file not rejected")
 		}
-		chunk := inputs[0]
-		if chunk.BinVer != raftio.TransportBinVersion || !chunk.Witness ||
-			chunk.ShardID != 100 || chunk.From != 1 || chunk.ReplicaID != 2 {
-			t.Errorf("unexpected chunk %+v", chunk)
+		write([]byte("external"))
+		if chunks.validateExternalFiles(chunk, td) {
+			t.Errorf("truncated external file not rejected")
 		}
-		for _, c := range inputs {
-			if len(c.Data) == 0 {
-				t.Errorf("data is empty")
-			}
-			c.DeploymentId = settings.UnmanagedDeploymentID
-			added := chunks.addLocked(c)
-			if !added {
-				t.Errorf("failed to add chunk")
-			}
+	}
+	fs := vfs.GetTestFS()
+	runChunkTest(t, fn, fs)
+}
+
+func getTestWitnessSnapshotData(t *testing.T, fs vfs.IFS) []byte {
+	fp := fs.PathJoin(snapshotDir, "witness.snapshot")
+	w, err := rsm.NewSnapshotWriter(fp, pb.NoCompression, fs)
+	if err != nil {
+		t.Fatalf("failed to create snapshot writer %v", err)
+	}
+	if _, err := w.Write(rsm.GetEmptyLRUSession()); err != nil {
+		t.Fatalf("failed to write %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close %v", err)
+	}
+	f, err := fs.Open(fp)
+	if err != nil {
+		t.Fatalf("failed to open %v", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("failed to read %v", err)
+	}
+	return data
+}
+
+// witness snapshots are sent as regular messages, witness snapshot chunks
+// are only sent by earlier versions
+func TestWitnessSnapshotChunkCanBeHandled(t *testing.T) {
+	fn := func(t *testing.T, chunks *Chunk, handler *testMessageHandler) {
+		data := getTestWitnessSnapshotData(t, chunks.fs)
+		c := pb.Chunk{
+			DeploymentId:   settings.UnmanagedDeploymentID,
+			BinVer:         raftio.TransportBinVersion,
+			ShardID:        100,
+			ReplicaID:      2,
+			From:           1,
+			FileChunkCount: 1,
+			ChunkCount:     1,
+			ChunkSize:      uint64(len(data)),
+			Index:          100,
+			Term:           200,
+			Filepath:       "witness.snapshot",
+			FileSize:       uint64(len(data)),
+			Witness:        true,
+			Data:           data,
+		}
+		if !chunks.addLocked(c) {
+			t.Errorf("failed to add chunk")
 		}
 		if handler.getSnapshotCount(100, 2) != 1 {
 			t.Errorf("failed to receive snapshot")
@@ -591,6 +790,23 @@ func TestWitnessSnapshotCanBeHandled(t *testing.T) {
 	runChunkTest(t, fn, fs)
 }
 
+func TestWitnessSnapshotCanNotBeStreamed(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("panic not triggered")
+		}
+	}()
+	msg := pb.Message{
+		Type:     pb.InstallSnapshot,
+		To:       2,
+		From:     1,
+		ShardID:  100,
+		Snapshot: pb.Snapshot{Index: 100, Term: 200, Witness: true},
+	}
+	trans := &Transport{}
+	trans.doSendSnapshot(msg)
+}
+
 func TestSnapshotRecordWithoutExternalFilesCanBeSplitIntoChunk(t *testing.T) {
 	fs := vfs.GetTestFS()
 	ss := pb.Snapshot{
@@ -805,3 +1021,84 @@ func TestGetMessageFromChunk(t *testing.T) {
 	fs := vfs.GetTestFS()
 	runChunkTest(t, fn, fs)
 }
+
+func TestMalformedChunkIsRejected(t *testing.T) {
+	tests := []func(c *pb.Chunk){
+		func(c *pb.Chunk) { c.ChunkCount = pb.PoisonChunkCount },
+		func(c *pb.Chunk) { c.ChunkId = c.ChunkCount },
+		func(c *pb.Chunk) { c.FileChunkId = c.FileChunkCount },
+		func(c *pb.Chunk) { c.FileChunkCount = maxFileChunkCount + 1 },
+		func(c *pb.Chunk) {
+			c.FileChunkId = maxFileChunkCount
+			c.FileChunkCount = pb.LastChunkCount
+		},
+		func(c *pb.Chunk) { c.Filepath = "" },
+		func(c *pb.Chunk) { c.Filepath = "/data/.." },
+		func(c *pb.Chunk) { c.Filepath = "/" },
+		func(c *pb.Chunk) {
+			c.HasFileInfo = true
+			c.FileInfo = pb.SnapshotFile{Filepath: "..", FileId: 1}
+		},
+	}
+	fs := vfs.GetTestFS()
+	for idx, tt := range tests {
+		c := getTestChunk()[1]
+		if err := checkChunk(fs, c); err != nil {
+			t.Fatalf("valid chunk rejected, %v", err)
+		}
+		tt(&c)
+		if err := checkChunk(fs, c); !errors.Is(err, ErrInvalidSnapshotChunk) {
+			t.Errorf("%d, malformed chunk not rejected, %v", idx, err)
+		}
+	}
+}
+
+func TestChunkWithUnexpectedFileChunkIDIsIgnored(t *testing.T) {
+	fn := func(t *testing.T, chunks *Chunk, handler *testMessageHandler) {
+		inputs := getTestChunk()
+		chunks.validate = false
+		first := inputs[0]
+		first.FileChunkId = 1
+		if chunks.Add(first) {
+			t.Fatalf("first chunk with file chunk id 1 not rejected")
+		}
+		if !chunks.Add(inputs[0]) {
+			t.Fatalf("failed to add the first chunk")
+		}
+		next := inputs[1]
+		next.FileChunkId = 2
+		if chunks.Add(next) {
+			t.Errorf("out of order file chunk not rejected")
+		}
+		next = inputs[1]
+		next.Filepath = "other.gbsnap"
+		if chunks.Add(next) {
+			t.Errorf("file chunk of another file not rejected")
+		}
+		if !chunks.Add(inputs[1]) {
+			t.Errorf("failed to add the second chunk")
+		}
+	}
+	fs := vfs.GetTestFS()
+	runChunkTest(t, fn, fs)
+}
+
+func FuzzSnapshotChunk(f *testing.F) {
+	for _, c := range getTestChunk() {
+		f.Add(pb.MustMarshal(&c))
+	}
+	fs := vfs.NewMemFS()
+	dir := func(shardID uint64, replicaID uint64) string {
+		return fs.PathJoin("snapshot", fmt.Sprintf("%d-%d", shardID, replicaID))
+	}
+	chunks := NewChunk(func(pb.MessageBatch) {},
+		func(uint64, uint64, uint64) {}, dir, settings.UnmanagedDeploymentID, fs)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var c pb.Chunk
+		if err := c.Unmarshal(data); err != nil {
+			return
+		}
+		chunks.Add(c)
+		chunks.Tick()
+	})
+}
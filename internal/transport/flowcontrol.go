@@ -0,0 +1,221 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// When Expert.TransportFlowControl is enabled, the sending side of a message
+// connection requests the remaining inbound capacity of the remote NodeHost by
+// sending the windowNumber on the connection. The remote side replies with a
+// window frame that has the following layout -
+//
+//	| windowNumber (2) | messages (8) | bytes (8) |
+//
+// Window requests are processed by the remote side after all message batches
+// previously sent on the same connection, the advertised window thus already
+// accounts for all messages in flight. Bulk messages are paused once the
+// advertised window is exhausted while control messages such as heartbeats
+// are always sent. To avoid deadlocks when both sides are saturated, a single
+// bulk message is always allowed after each window request, i.e. at least one
+// entry batch is sent per round trip.
+
+const (
+	windowFrameSize = 18
+)
+
+var (
+	windowNumber       = [2]byte{0xAE, 0x83}
+	errWindowRequested = errors.New("window requested")
+	// windowPollInterval is the minimum interval between two window requests
+	// when bulk messages are paused.
+	windowPollInterval = 5 * time.Millisecond
+	unlimitedWindow    = window{messages: math.MaxUint64, bytes: math.MaxUint64}
+)
+
+// IInboundCapacity is the optional interface implemented by IMessageHandler
+// instances that can report the remaining capacity of their inbound queues.
+type IInboundCapacity interface {
+	// InboundCapacity returns the number of messages and the total in memory
+	// size of entries in bytes that can still be accepted.
+	InboundCapacity() (uint64, uint64)
+}
+
+// windowed is the interface implemented by connections that support the flow
+// control window advertised by the remote side.
+type windowed interface {
+	// Window requests the remaining inbound capacity of the remote side.
+	Window() (window, error)
+}
+
+// window is the inbound capacity advertised by the receiving side.
+type window struct {
+	messages uint64
+	bytes    uint64
+}
+
+func (w *window) exhausted() bool {
+	return w.messages == 0 || w.bytes == 0
+}
+
+func (w *window) consume(msg pb.Message) {
+	w.messages = subtract(w.messages, 1)
+	if msg.Type == pb.Replicate {
+		w.bytes = subtract(w.bytes, pb.GetEntrySliceInMemSize(msg.Entries))
+	}
+}
+
+func (w *window) encode(buf []byte) []byte {
+	if len(buf) < windowFrameSize {
+		panic("input buf too small")
+	}
+	copy(buf, windowNumber[:])
+	binary.BigEndian.PutUint64(buf[2:], w.messages)
+	binary.BigEndian.PutUint64(buf[10:], w.bytes)
+	return buf[:windowFrameSize]
+}
+
+func (w *window) decode(buf []byte) bool {
+	if len(buf) < windowFrameSize {
+		return false
+	}
+	if !bytes.Equal(buf[:len(windowNumber)], windowNumber[:]) {
+		return false
+	}
+	w.messages = binary.BigEndian.Uint64(buf[2:])
+	w.bytes = binary.BigEndian.Uint64(buf[10:])
+	return true
+}
+
+func subtract(v uint64, sz uint64) uint64 {
+	if v < sz {
+		return 0
+	}
+	return v - sz
+}
+
+// Window requests the remaining inbound capacity of the remote node.
+func (c *TCPConnection) Window() (window, error) {
+	w, err := c.window()
+	if err != nil {
+		c.failed = true
+		return window{}, err
+	}
+	return w, nil
+}
+
+func (c *TCPConnection) window() (window, error) {
+	timeout := c.getStallTimeout()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return window{}, err
+	}
+	if _, err := c.conn.Write(windowNumber[:]); err != nil {
+		return window{}, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case w := <-c.windowc:
+		return w, nil
+	case <-c.readc:
+		return window{}, ErrBadMessage
+	case <-timer.C:
+		return window{}, os.ErrDeadlineExceeded
+	}
+}
+
+// sendWindow replies the window request with the remaining inbound capacity.
+func (t *TCP) sendWindow(conn net.Conn) error {
+	w := unlimitedWindow
+	if t.inboundCapacity != nil {
+		w = t.inboundCapacity()
+	}
+	return sendPoison(conn, w.encode(make([]byte, windowFrameSize)))
+}
+
+// flowControl tracks the window advertised by the remote side of a message
+// connection. A nil *flowControl allows everything to be sent.
+type flowControl struct {
+	conn   windowed
+	stats  *peerStats
+	window window
+	polled time.Time
+	paused bool
+}
+
+func newFlowControl(conn windowed, stats *peerStats) *flowControl {
+	return &flowControl{conn: conn, stats: stats}
+}
+
+// allowed returns a boolean flag indicating whether bulk messages can be
+// sent.
+func (fc *flowControl) allowed() bool {
+	return fc == nil || !fc.window.exhausted()
+}
+
+func (fc *flowControl) consume(msg pb.Message) {
+	if fc == nil {
+		return
+	}
+	fc.window.consume(msg)
+	if fc.window.exhausted() && !fc.paused {
+		fc.paused = true
+		fc.stats.pause()
+	}
+}
+
+// pollDelay returns the amount of time to wait before the next window
+// request.
+func (fc *flowControl) pollDelay() time.Duration {
+	d := windowPollInterval - time.Since(fc.polled)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// refresh requests the latest window from the remote side.
+func (fc *flowControl) refresh() error {
+	w, err := fc.conn.Window()
+	if err != nil {
+		return err
+	}
+	fc.polled = time.Now()
+	if w.exhausted() {
+		w = window{messages: 1, bytes: math.MaxUint64}
+	} else if fc.paused {
+		fc.paused = false
+		fc.stats.resume()
+	}
+	fc.window = w
+	return nil
+}
+
+func (fc *flowControl) close() {
+	if fc.paused {
+		fc.paused = false
+		fc.stats.resume()
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"testing"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func TestWindowCanBeEncodedAndDecoded(t *testing.T) {
+	w := window{messages: 1234, bytes: 5678}
+	buf := make([]byte, windowFrameSize)
+	result := w.encode(buf)
+	if len(result) != windowFrameSize {
+		t.Fatalf("unexpected size")
+	}
+	ww := window{}
+	if !ww.decode(result) {
+		t.Fatalf("decode failed")
+	}
+	if w != ww {
+		t.Errorf("window changed")
+	}
+	result[0] = 0
+	if ww.decode(result) {
+		t.Errorf("invalid window frame not reported")
+	}
+}
+
+func TestWindowCanBeConsumed(t *testing.T) {
+	msg := pb.Message{
+		Type:    pb.Replicate,
+		Entries: []pb.Entry{{Cmd: make([]byte, 16)}},
+	}
+	sz := pb.GetEntrySliceInMemSize(msg.Entries)
+	w := window{messages: 2, bytes: sz + 1}
+	w.consume(msg)
+	if w.exhausted() {
+		t.Fatalf("unexpectedly exhausted")
+	}
+	if w.messages != 1 || w.bytes != 1 {
+		t.Errorf("unexpected window %+v", w)
+	}
+	w.consume(msg)
+	if !w.exhausted() || w.messages != 0 || w.bytes != 0 {
+		t.Errorf("unexpected window %+v", w)
+	}
+	var fc *flowControl
+	if !fc.allowed() {
+		t.Errorf("nil flow control not allowed")
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"hash/crc32"
+	"net"
+	"time"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	// frameHeaderSize is the size of the magic number and the request header
+	// in front of the payload of each frame.
+	frameHeaderSize = len(magicNumber) + requestHeaderSize
+	// frameBufferShrinkInterval is the number of frames after which the frame
+	// buffer is checked for shrinking.
+	frameBufferShrinkInterval = 256
+)
+
+// frameBuffer is a reusable per connection buffer for encoding or decoding
+// frames. It grows to fit the largest frame seen, it is shrunk periodically
+// when all recent frames only used a small portion of it.
+type frameBuffer struct {
+	buf     []byte
+	minSize int
+	maxUsed int
+	uses    int
+}
+
+func newFrameBuffer(minSize int) *frameBuffer {
+	return &frameBuffer{buf: make([]byte, minSize), minSize: minSize}
+}
+
+// get returns a byte slice of the specified size backed by the buffer. The
+// returned slice is only valid until the next get call.
+func (b *frameBuffer) get(sz int) []byte {
+	if sz > b.maxUsed {
+		b.maxUsed = sz
+	}
+	b.uses++
+	if b.uses >= frameBufferShrinkInterval {
+		if len(b.buf) > b.minSize && b.maxUsed*2 <= len(b.buf) {
+			size := b.maxUsed
+			if size < b.minSize {
+				size = b.minSize
+			}
+			b.buf = make([]byte, size)
+		}
+		b.uses = 0
+		b.maxUsed = 0
+	}
+	if sz > len(b.buf) {
+		b.buf = make([]byte, sz)
+	}
+	return b.buf[:sz]
+}
+
+// grow returns a byte slice of the specified size backed by the buffer, the
+// content of used, the slice returned by the last get or grow call, is
+// preserved. The returned slice is only valid until the next get call.
+func (b *frameBuffer) grow(used []byte, sz int) []byte {
+	if sz > b.maxUsed {
+		b.maxUsed = sz
+	}
+	if sz > len(b.buf) {
+		buf := make([]byte, sz)
+		copy(buf, used)
+		b.buf = buf
+	}
+	return b.buf[:sz]
+}
+
+// encodeFrame encodes the magic number and the request header into the first
+// frameHeaderSize bytes of the frame. The payload is expected to be already
+// marshaled into the rest of the frame.
+func encodeFrame(frame []byte, method uint16, encrypted bool) []byte {
+	payload := frame[frameHeaderSize:]
+	header := requestHeader{method: method, size: uint64(len(payload))}
+	if !encrypted {
+		header.crc = crc32.ChecksumIEEE(payload)
+	}
+	copy(frame, magicNumber[:])
+	header.encode(frame[len(magicNumber):])
+	return frame
+}
+
+// writeFrame writes the encoded frame to the connection in pieces of at most
+// recvBufSize bytes, each piece is required to be written within the specified
+// timeout.
+func writeFrame(conn net.Conn, frame []byte, timeout time.Duration) error {
+	sent := 0
+	for sent < len(frame) {
+		sz := int(recvBufSize)
+		if sent+sz > len(frame) {
+			sz = len(frame) - sent
+		}
+		if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+		if _, err := conn.Write(frame[sent : sent+sz]); err != nil {
+			return err
+		}
+		sent += sz
+	}
+	return nil
+}
+
+// retainPayloads copies the Cmd and RequestID fields of all entries in the
+// batch into a single newly allocated byte slice, so the batch unmarshaled by
+// UnmarshalShared no longer references the reused frame buffer.
+func retainPayloads(batch *pb.MessageBatch) {
+	total := 0
+	for i := range batch.Requests {
+		for j := range batch.Requests[i].Entries {
+			e := &batch.Requests[i].Entries[j]
+			total += len(e.Cmd) + len(e.RequestID)
+		}
+	}
+	var buf []byte
+	if total > 0 {
+		buf = make([]byte, total)
+	}
+	retain := func(v []byte) []byte {
+		if v == nil {
+			return nil
+		}
+		if len(v) == 0 {
+			return []byte{}
+		}
+		n := copy(buf, v)
+		v = buf[:n:n]
+		buf = buf[n:]
+		return v
+	}
+	for i := range batch.Requests {
+		for j := range batch.Requests[i].Entries {
+			e := &batch.Requests[i].Entries[j]
+			e.Cmd = retain(e.Cmd)
+			e.RequestID = retain(e.RequestID)
+		}
+	}
+}
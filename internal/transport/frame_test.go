@@ -0,0 +1,376 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/internal/settings"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// bufferConn is a net.Conn backed by an in memory buffer.
+type bufferConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufferConn) Read(b []byte) (int, error)         { return c.buf.Read(b) }
+func (c *bufferConn) Write(b []byte) (int, error)        { return c.buf.Write(b) }
+func (c *bufferConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *bufferConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func getFrameTestBatch(entryCount int, cmdSize int) pb.MessageBatch {
+	m := pb.Message{Type: pb.Replicate, To: 2, From: 1, ShardID: 100, Term: 5}
+	for i := 0; i < entryCount; i++ {
+		cmd := make([]byte, cmdSize)
+		for j := range cmd {
+			cmd[j] = byte(i + j)
+		}
+		m.Entries = append(m.Entries,
+			pb.Entry{Term: 5, Index: uint64(i + 1), Cmd: cmd})
+	}
+	return pb.MessageBatch{
+		Requests:      []pb.Message{m},
+		DeploymentId:  1,
+		SourceAddress: "localhost:9090",
+		BinVer:        raftio.TransportBinVersion,
+	}
+}
+
+func encodeTestBatch(b *frameBuffer,
+	batch pb.MessageBatch, encrypted bool) []byte {
+	frame := b.get(frameHeaderSize + batch.SizeUpperLimit())
+	sz, err := batch.MarshalTo(frame[frameHeaderSize:])
+	if err != nil {
+		panic(err)
+	}
+	return encodeFrame(frame[:frameHeaderSize+sz], raftType, encrypted)
+}
+
+func decodeTestBatch(conn net.Conn, header []byte,
+	b *frameBuffer, encrypted bool) (pb.MessageBatch, error) {
+	if err := readMagicNumber(conn, header[:len(magicNumber)]); err != nil {
+		return pb.MessageBatch{}, err
+	}
+	_, buf, err := readMessage(conn,
+		header[len(magicNumber):], b, encrypted)
+	if err != nil {
+		return pb.MessageBatch{}, err
+	}
+	batch := pb.MessageBatch{}
+	if err := batch.UnmarshalShared(buf); err != nil {
+		return pb.MessageBatch{}, err
+	}
+	retainPayloads(&batch)
+	return batch, nil
+}
+
+func TestFrameWireFormatIsUnchanged(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		batch := getFrameTestBatch(16, 32)
+		payload := pb.MustMarshal(&batch)
+		header := requestHeader{method: raftType, size: uint64(len(payload))}
+		if !encrypted {
+			header.crc = crc32.ChecksumIEEE(payload)
+		}
+		expected := append([]byte{}, magicNumber[:]...)
+		expected = append(expected,
+			header.encode(make([]byte, requestHeaderSize))...)
+		expected = append(expected, payload...)
+		frame := encodeTestBatch(newFrameBuffer(0), batch, encrypted)
+		if !bytes.Equal(expected, frame) {
+			t.Errorf("frame changed, encrypted %t", encrypted)
+		}
+	}
+}
+
+func TestCorruptedFramePayloadIsRejected(t *testing.T) {
+	batch := getFrameTestBatch(4, 16)
+	frame := encodeTestBatch(newFrameBuffer(0), batch, false)
+	frame[len(frame)-1]++
+	conn := &bufferConn{}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatalf("write failed %v", err)
+	}
+	header := make([]byte, frameHeaderSize)
+	if _, err := decodeTestBatch(conn,
+		header, newFrameBuffer(0), false); err != ErrBadMessage {
+		t.Errorf("corrupted payload not rejected, %v", err)
+	}
+}
+
+func TestBogusPayloadLengthIsNotAllocated(t *testing.T) {
+	header := requestHeader{method: raftType, size: 1 << 40}
+	conn := &bufferConn{}
+	if _, err := conn.Write(header.encode(
+		make([]byte, requestHeaderSize))); err != nil {
+		t.Fatalf("write failed %v", err)
+	}
+	if _, err := conn.Write(make([]byte, 1024)); err != nil {
+		t.Fatalf("write failed %v", err)
+	}
+	b := newFrameBuffer(0)
+	if _, _, err := readMessage(conn,
+		make([]byte, requestHeaderSize), b, false); err == nil {
+		t.Fatalf("truncated payload not rejected")
+	}
+	if uint64(len(b.buf)) > recvBufSize {
+		t.Errorf("allocated %d bytes for the bogus payload", len(b.buf))
+	}
+}
+
+func TestLargeFrameCanBeDecoded(t *testing.T) {
+	batch := getFrameTestBatch(5, int(recvBufSize))
+	conn := &bufferConn{}
+	if _, err := conn.Write(encodeTestBatch(newFrameBuffer(0),
+		batch, false)); err != nil {
+		t.Fatalf("write failed %v", err)
+	}
+	header := make([]byte, frameHeaderSize)
+	result, err := decodeTestBatch(conn, header, newFrameBuffer(0), false)
+	if err != nil {
+		t.Fatalf("decode failed %v", err)
+	}
+	if !reflect.DeepEqual(&batch, &result) {
+		t.Errorf("batch changed")
+	}
+}
+
+func TestFrameBufferGrowsAndShrinks(t *testing.T) {
+	b := newFrameBuffer(64)
+	if len(b.get(32)) != 32 || len(b.buf) != 64 {
+		t.Errorf("unexpected buffer size")
+	}
+	if len(b.get(1024)) != 1024 || len(b.buf) != 1024 {
+		t.Errorf("buffer didn't grow")
+	}
+	for i := 0; i < 2*frameBufferShrinkInterval; i++ {
+		b.get(16)
+	}
+	if len(b.buf) != 64 {
+		t.Errorf("buffer not shrunk, len %d", len(b.buf))
+	}
+	for i := 0; i < 2*frameBufferShrinkInterval; i++ {
+		b.get(1024)
+		b.get(16)
+	}
+	if len(b.buf) != 1024 {
+		t.Errorf("buffer in use shrunk, len %d", len(b.buf))
+	}
+}
+
+func TestDecodedBatchDoesNotReferenceFrameBuffer(t *testing.T) {
+	conn := &bufferConn{}
+	eb := newFrameBuffer(0)
+	b1 := getFrameTestBatch(8, 64)
+	b1.Requests[0].Entries[0].RequestID = []byte("0123456789abcdef")
+	if _, err := conn.Write(encodeTestBatch(eb, b1, false)); err != nil {
+		t.Fatalf("write failed %v", err)
+	}
+	b2 := getFrameTestBatch(8, 64)
+	for i := range b2.Requests[0].Entries {
+		cmd := b2.Requests[0].Entries[i].Cmd
+		for j := range cmd {
+			cmd[j] = 0xFF
+		}
+	}
+	if _, err := conn.Write(encodeTestBatch(eb, b2, false)); err != nil {
+		t.Fatalf("write failed %v", err)
+	}
+	header := make([]byte, frameHeaderSize)
+	db := newFrameBuffer(0)
+	r1, err := decodeTestBatch(conn, header, db, false)
+	if err != nil {
+		t.Fatalf("decode failed %v", err)
+	}
+	r2, err := decodeTestBatch(conn, header, db, false)
+	if err != nil {
+		t.Fatalf("decode failed %v", err)
+	}
+	if !reflect.DeepEqual(&b1, &r1) {
+		t.Errorf("first batch changed")
+	}
+	if !reflect.DeepEqual(&b2, &r2) {
+		t.Errorf("second batch changed")
+	}
+}
+
+func FuzzFrameRoundTrip(f *testing.F) {
+	f.Add([]byte("hello"), []byte("world"), uint8(3), false)
+	f.Add([]byte{}, []byte{0}, uint8(0), true)
+	f.Fuzz(func(t *testing.T, c1 []byte, c2 []byte, count uint8, encrypted bool) {
+		getBatch := func(cmd []byte) pb.MessageBatch {
+			m := pb.Message{Type: pb.Replicate, To: 2, From: 1, ShardID: 1}
+			for i := 0; i < int(count%16)+1; i++ {
+				e := pb.Entry{Index: uint64(i + 1), Cmd: cmd[:len(cmd)*i/16]}
+				if i%2 == 1 {
+					e.RequestID = cmd
+				}
+				m.Entries = append(m.Entries, e)
+			}
+			return pb.MessageBatch{Requests: []pb.Message{m}}
+		}
+		// batches are compared in their encoded form as empty Cmd and
+		// RequestID fields are not encoded
+		b1 := getBatch(c1)
+		b2 := getBatch(c2)
+		conn := &bufferConn{}
+		eb := newFrameBuffer(0)
+		for _, b := range []pb.MessageBatch{b1, b2, b1} {
+			if _, err := conn.Write(encodeTestBatch(eb, b, encrypted)); err != nil {
+				t.Fatalf("write failed %v", err)
+			}
+		}
+		header := make([]byte, frameHeaderSize)
+		db := newFrameBuffer(0)
+		var results []pb.MessageBatch
+		for i := 0; i < 3; i++ {
+			r, err := decodeTestBatch(conn, header, db, encrypted)
+			if err != nil {
+				t.Fatalf("decode failed %v", err)
+			}
+			results = append(results, r)
+		}
+		for i, b := range []pb.MessageBatch{b1, b2, b1} {
+			if !bytes.Equal(pb.MustMarshal(&b), pb.MustMarshal(&results[i])) {
+				t.Fatalf("batch %d changed", i)
+			}
+		}
+	})
+}
+
+func FuzzReadMessage(f *testing.F) {
+	batch := getFrameTestBatch(2, 8)
+	frame := encodeTestBatch(newFrameBuffer(0), batch, false)
+	f.Add(frame[len(magicNumber):])
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := &bufferConn{}
+		if _, err := conn.Write(data); err != nil {
+			t.Fatalf("write failed %v", err)
+		}
+		header := make([]byte, requestHeaderSize)
+		_, buf, err := readMessage(conn, header, newFrameBuffer(0), false)
+		if err != nil {
+			return
+		}
+		batch := pb.MessageBatch{}
+		if err := batch.UnmarshalShared(buf); err != nil {
+			return
+		}
+		retainPayloads(&batch)
+	})
+}
+
+func BenchmarkEncodeMessageBatch(b *testing.B) {
+	b.ReportAllocs()
+	batch := getFrameTestBatch(64, 128)
+	fb := newFrameBuffer(int(perConnBufSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		encodeTestBatch(fb, batch, false)
+	}
+}
+
+func BenchmarkDecodeMessageBatch(b *testing.B) {
+	b.ReportAllocs()
+	batch := getFrameTestBatch(64, 128)
+	frame := encodeTestBatch(newFrameBuffer(0), batch, false)
+	conn := &bufferConn{}
+	conn.buf.Grow(len(frame))
+	header := make([]byte, frameHeaderSize)
+	fb := newFrameBuffer(int(payloadBufferSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.buf.Reset()
+		if _, err := conn.Write(frame); err != nil {
+			b.Fatalf("write failed %v", err)
+		}
+		if _, err := decodeTestBatch(conn, header, fb, false); err != nil {
+			b.Fatalf("decode failed %v", err)
+		}
+	}
+}
+
+func TestMaxSizeMembershipCanBeFramed(t *testing.T) {
+	m := pb.Membership{
+		ConfigChangeId:     1000,
+		Addresses:          make(map[uint64]string),
+		Removed:            make(map[uint64]bool),
+		Retired:            make(map[string]uint64),
+		PrunedRemovedCount: 100,
+		PrunedRemovedHash:  12345,
+		PrunedRemovedMax:   settings.MaxMembers,
+	}
+	addr := func(nid uint64) string {
+		prefix := fmt.Sprintf("%d:", nid)
+		return prefix + strings.Repeat("a",
+			int(settings.MaxAddressLength)-len(prefix))
+	}
+	for nid := uint64(1); nid <= settings.MaxMembers; nid++ {
+		m.Addresses[nid] = addr(nid)
+		m.Retired[addr(nid+settings.MaxMembers)] = nid
+	}
+	for i := uint64(1); i <= settings.MaxRemovedReplicas; i++ {
+		m.Removed[settings.MaxMembers+i] = true
+	}
+	cc := pb.ConfigChange{Type: pb.EnterJoint, Members: m.Addresses}
+	batch := getFrameTestBatch(0, 0)
+	batch.Requests[0].Entries = []pb.Entry{{Term: 5, Index: 1,
+		Type: pb.ConfigChangeEntry, Cmd: pb.MustMarshal(&cc)}}
+	batch.Requests = append(batch.Requests, pb.Message{
+		Type:     pb.InstallSnapshot,
+		To:       2,
+		From:     1,
+		ShardID:  100,
+		Term:     5,
+		Snapshot: pb.Snapshot{Index: 100, Term: 5, Membership: m},
+	})
+	if sz := uint64(batch.SizeUpperLimit()); sz >= maxMsgBatchSize {
+		t.Fatalf("batch size %d exceeds the limit", sz)
+	}
+	for _, encrypted := range []bool{false, true} {
+		frame := encodeTestBatch(newFrameBuffer(0), batch, encrypted)
+		conn := &bufferConn{}
+		if _, err := conn.Write(frame); err != nil {
+			t.Fatalf("write failed %v", err)
+		}
+		result, err := decodeTestBatch(conn,
+			make([]byte, frameHeaderSize), newFrameBuffer(0), encrypted)
+		if err != nil {
+			t.Fatalf("failed to decode %v", err)
+		}
+		if len(result.Requests) != 2 {
+			t.Fatalf("unexpected request count %d", len(result.Requests))
+		}
+		if !reflect.DeepEqual(result.Requests[1].Snapshot.Membership, m) {
+			t.Errorf("membership changed, encrypted %t", encrypted)
+		}
+		var rcc pb.ConfigChange
+		pb.MustUnmarshal(&rcc, result.Requests[0].Entries[0].Cmd)
+		if !reflect.DeepEqual(rcc, cc) {
+			t.Errorf("config change changed, encrypted %t", encrypted)
+		}
+	}
+}
@@ -69,8 +69,8 @@ func (f *fuzzROConn) SetWriteDeadline(t time.Time) error {
 func Fuzz(data []byte) int {
 	roconn := newFuzzROConn(data)
 	header := make([]byte, requestHeaderSize)
-	tbuf := make([]byte, payloadBufferSize)
-	if _, _, err := readMessage(roconn, header, tbuf); err != nil {
+	tbuf := newFrameBuffer(int(payloadBufferSize))
+	if _, _, err := readMessage(roconn, header, tbuf, false); err != nil {
 		return 0
 	}
 	return 1
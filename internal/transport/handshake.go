@@ -0,0 +1,261 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// When TransportAuthToken is configured, the dialing side sends a hello frame
+// before anything else on a new connection, the remote side replies with a
+// challenge frame. Both frames have the following layout -
+//
+//	| handshakeNumber (2) | version (1) | flags (1) | nonce (16) | idLen (1) | id |
+//
+// nonce is a random value generated by each side for each handshake and id is
+// the NodeHost ID of the sender. The dialing side then sends the proof frame -
+//
+//	| mac (32) |
+//
+// mac is the HMAC-SHA256 keyed by the token of the version and flags fields
+// of the hello frame, both nonces and both NodeHost IDs, the token itself is
+// never sent over the network. As the MAC covers the nonce chosen by the
+// remote side, a recorded handshake can't be replayed. The remote side replies
+// with the handshakeNumber followed by its own protocol version when the
+// handshake is accepted, or with the handshakeRejectNumber otherwise.
+
+const (
+	transportVersion    uint8 = 1
+	handshakeAuthFlag   uint8 = 1
+	handshakeHeaderSize       = 21
+	handshakeNonceSize        = 16
+	maxHandshakeIDSize        = 255
+)
+
+var (
+	handshakeNumber       = [2]byte{0xAE, 0x81}
+	handshakeRejectNumber = [2]byte{0xAE, 0x82}
+	// ErrHandshakeRejected is the error returned when the handshake is rejected
+	// by the remote NodeHost, e.g. when it is configured with a different
+	// TransportAuthToken.
+	ErrHandshakeRejected = errors.New("transport handshake rejected")
+	// errHandshakeReceived is the error returned by readMagicNumber when the
+	// remote side is starting the handshake.
+	errHandshakeReceived = errors.New("handshake received")
+)
+
+// handshake is the hello frame sent by the dialing side or the challenge
+// frame sent by the remote side.
+type handshake struct {
+	version uint8
+	flags   uint8
+	nonce   [handshakeNonceSize]byte
+	id      string
+}
+
+func newHandshake(token string, id string) handshake {
+	if len(id) > maxHandshakeIDSize {
+		// NodeHost IDs are usually UUIDs, long custom IDs are hashed
+		sum := sha256.Sum256([]byte(id))
+		id = hex.EncodeToString(sum[:])
+	}
+	h := handshake{version: transportVersion, id: id}
+	if len(token) > 0 {
+		h.flags |= handshakeAuthFlag
+	}
+	if _, err := rand.Read(h.nonce[:]); err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// getMAC returns the MAC of the hello frame h and the challenge frame c.
+func (h *handshake) getMAC(token string, c handshake) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte{h.version, h.flags})
+	mac.Write(h.nonce[:])
+	mac.Write(c.nonce[:])
+	mac.Write([]byte{uint8(len(h.id))})
+	mac.Write([]byte(h.id))
+	mac.Write([]byte{uint8(len(c.id))})
+	mac.Write([]byte(c.id))
+	return mac.Sum(nil)
+}
+
+// verify verifies the mac sent by the dialing side in response to the
+// challenge frame c, h is the hello frame sent by the dialing side.
+func (h *handshake) verify(token string, c handshake, mac []byte) bool {
+	if len(token) == 0 {
+		return true
+	}
+	if h.flags&handshakeAuthFlag == 0 {
+		return false
+	}
+	return hmac.Equal(mac, h.getMAC(token, c))
+}
+
+func (h *handshake) size() int {
+	return handshakeHeaderSize + len(h.id)
+}
+
+func (h *handshake) encode(buf []byte) []byte {
+	if len(buf) < h.size() {
+		panic("input buf too small")
+	}
+	copy(buf, handshakeNumber[:])
+	buf[2] = h.version
+	buf[3] = h.flags
+	copy(buf[4:], h.nonce[:])
+	buf[4+handshakeNonceSize] = uint8(len(h.id))
+	copy(buf[5+handshakeNonceSize:], h.id)
+	return buf[:h.size()]
+}
+
+// decode decodes the handshake frame with its leading handshakeNumber already
+// consumed. It returns the length of the id field that follows the decoded
+// fixed size part.
+func (h *handshake) decode(buf []byte) (int, bool) {
+	if len(buf) < handshakeHeaderSize-len(handshakeNumber) {
+		return 0, false
+	}
+	h.version = buf[0]
+	h.flags = buf[1]
+	copy(h.nonce[:], buf[2:])
+	return int(buf[2+handshakeNonceSize]), h.version > 0
+}
+
+// readHandshake reads the handshake frame with its leading handshakeNumber
+// already consumed.
+func readHandshake(conn net.Conn) (handshake, bool) {
+	h := handshake{}
+	buf := make([]byte, handshakeHeaderSize-len(handshakeNumber))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return h, false
+	}
+	sz, ok := h.decode(buf)
+	if !ok {
+		return h, false
+	}
+	id := make([]byte, sz)
+	if _, err := io.ReadFull(conn, id); err != nil {
+		return h, false
+	}
+	h.id = string(id)
+	return h, true
+}
+
+// sendHandshake sends the hello frame, answers the challenge from the remote
+// side and waits for the reply.
+func (t *TCP) sendHandshake(conn net.Conn) error {
+	h := newHandshake(t.authToken, t.nodeHostID)
+	tt := time.Now().Add(magicNumberDuration).Add(headerDuration)
+	if err := conn.SetDeadline(tt); err != nil {
+		return err
+	}
+	if _, err := conn.Write(h.encode(make([]byte, h.size()))); err != nil {
+		return err
+	}
+	if err := readHandshakeNumber(conn); err != nil {
+		return err
+	}
+	c, ok := readHandshake(conn)
+	if !ok {
+		return ErrBadMessage
+	}
+	if _, err := conn.Write(h.getMAC(t.authToken, c)); err != nil {
+		return err
+	}
+	if err := readHandshakeNumber(conn); err != nil {
+		return err
+	}
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return err
+	}
+	if version[0] == 0 {
+		return ErrBadMessage
+	}
+	return nil
+}
+
+func readHandshakeNumber(conn net.Conn) error {
+	num := make([]byte, len(handshakeNumber))
+	if _, err := io.ReadFull(conn, num); err != nil {
+		return errors.Wrapf(ErrHandshakeRejected, "%v", err)
+	}
+	if !bytes.Equal(num, handshakeNumber[:]) {
+		return ErrHandshakeRejected
+	}
+	return nil
+}
+
+// authenticate reads the rest of the hello frame sent by the remote side,
+// challenges it and replies with the result. It returns a boolean flag
+// indicating whether the remote side is authenticated.
+func (t *TCP) authenticate(conn net.Conn) bool {
+	tt := time.Now().Add(headerDuration)
+	if err := conn.SetReadDeadline(tt); err != nil {
+		return false
+	}
+	h, ok := readHandshake(conn)
+	if !ok {
+		return false
+	}
+	c := newHandshake("", t.nodeHostID)
+	if err := sendPoison(conn, c.encode(make([]byte, c.size()))); err != nil {
+		plog.Debugf("failed to send the challenge %v", err)
+		return false
+	}
+	mac := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, mac); err != nil {
+		return false
+	}
+	if !h.verify(t.authToken, c, mac) {
+		plog.Warningf("handshake from %s failed to be authenticated",
+			conn.RemoteAddr())
+		if err := sendPoison(conn, handshakeRejectNumber[:]); err != nil {
+			plog.Debugf("failed to reject the handshake %v", err)
+		}
+		t.rejected(conn)
+		return false
+	}
+	reply := []byte{handshakeNumber[0], handshakeNumber[1], transportVersion}
+	if err := sendPoison(conn, reply); err != nil {
+		plog.Debugf("failed to accept the handshake %v", err)
+		return false
+	}
+	return true
+}
+
+// authRequired returns a boolean flag indicating whether connections without
+// the handshake should be rejected.
+func (t *TCP) authRequired() bool {
+	return len(t.authToken) > 0 && !t.allowUnauthenticated
+}
+
+func (t *TCP) rejected(conn net.Conn) {
+	if t.onRejected != nil {
+		t.onRejected(conn.RemoteAddr().String())
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHandshakeCanBeEncodedAndDecoded(t *testing.T) {
+	for _, id := range []string{"", "nhid-1", strings.Repeat("x", 300)} {
+		h := newHandshake("token", id)
+		buf := make([]byte, h.size())
+		result := h.encode(buf)
+		if len(result) != h.size() || len(h.id) > maxHandshakeIDSize {
+			t.Fatalf("unexpected size")
+		}
+		hh := handshake{}
+		sz, ok := hh.decode(result[len(handshakeNumber):])
+		if !ok || sz != len(h.id) {
+			t.Fatalf("decode failed")
+		}
+		hh.id = string(result[handshakeHeaderSize:])
+		if !reflect.DeepEqual(&h, &hh) {
+			t.Errorf("handshake changed")
+		}
+	}
+}
+
+func TestHandshakeCanBeVerified(t *testing.T) {
+	tests := []struct {
+		token  string
+		rtoken string
+		ok     bool
+	}{
+		{"", "", true},
+		{"token", "", true},
+		{"token", "token", true},
+		{"", "token", false},
+		{"token", "other-token", false},
+	}
+	for idx, tt := range tests {
+		h := newHandshake(tt.token, "nhid-1")
+		c := newHandshake("", "nhid-2")
+		if h.verify(tt.rtoken, c, h.getMAC(tt.token, c)) != tt.ok {
+			t.Errorf("%d, unexpected verify result", idx)
+		}
+	}
+}
+
+func TestHandshakeCanNotBeReplayed(t *testing.T) {
+	h := newHandshake("token", "nhid-1")
+	c := newHandshake("", "nhid-2")
+	mac := h.getMAC("token", c)
+	if !h.verify("token", c, mac) {
+		t.Fatalf("failed to verify")
+	}
+	// a new challenge is sent to each connection
+	if h.verify("token", newHandshake("", "nhid-2"), mac) {
+		t.Errorf("replayed handshake verified")
+	}
+	// the MAC is bound to NodeHost IDs
+	other := c
+	other.id = "nhid-3"
+	if h.verify("token", other, mac) {
+		t.Errorf("handshake for another NodeHost verified")
+	}
+	spoofed := h
+	spoofed.id = "nhid-3"
+	if spoofed.verify("token", c, mac) {
+		t.Errorf("handshake from spoofed NodeHost verified")
+	}
+}
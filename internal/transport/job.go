@@ -68,6 +68,7 @@ func (s *Sink) ToReplicaID() uint64 {
 
 type job struct {
 	conn         raftio.ISnapshotConnection
+	fc           *snapshotFlowControl
 	preSend      atomic.Value
 	postSend     atomic.Value
 	fs           vfs.IFS
@@ -80,7 +81,12 @@ type job struct {
 	deploymentID uint64
 	replicaID    uint64
 	shardID      uint64
-	streaming    bool
+	maxUnacked   uint64
+	// staged is the total size of snapshot chunk data held in memory by all
+	// jobs of the transport, it is nil when not accounted.
+	staged    *uint64
+	done      int32
+	streaming bool
 }
 
 func newJob(ctx context.Context,
@@ -122,6 +128,7 @@ func (j *job) connect(addr string) error {
 		return err
 	}
 	j.conn = conn
+	j.fc = newSnapshotFlowControl(conn, j.maxUnacked)
 	return nil
 }
 
@@ -143,22 +150,65 @@ func (j *job) AddChunk(chunk pb.Chunk) (bool, bool) {
 		plog.Debugf("sending a poison chunk to %s", dn(j.shardID, j.replicaID))
 	}
 
+	// accounted before it is queued so it is never released before being
+	// accounted
+	sz := uint64(len(chunk.Data))
+	j.stage(sz)
 	select {
 	case j.ch <- chunk:
+		if atomic.LoadInt32(&j.done) == 1 {
+			j.drain()
+		}
 		return true, false
 	case <-j.completed:
+		j.unstage(sz)
 		if !chunk.IsPoisonChunk() {
 			plog.Panicf("more chunk received for completed job")
 		}
 		return true, false
 	case <-j.failed:
+		j.unstage(sz)
 		plog.Warningf("stream snapshot to %s failed", dn(j.shardID, j.replicaID))
 		return false, false
 	case <-j.stopc:
+		j.unstage(sz)
 		return false, true
 	}
 }
 
+func (j *job) stage(sz uint64) {
+	if j.staged != nil && sz > 0 {
+		atomic.AddUint64(j.staged, sz)
+	}
+}
+
+func (j *job) unstage(sz uint64) {
+	if j.staged != nil && sz > 0 {
+		atomic.AddUint64(j.staged, ^(sz - 1))
+	}
+}
+
+// finish releases chunks left in the queue once the job is no longer
+// processed, chunks queued later are released by AddChunk.
+func (j *job) finish() {
+	atomic.StoreInt32(&j.done, 1)
+	j.drain()
+}
+
+func (j *job) drain() {
+	for {
+		select {
+		case chunk, ok := <-j.ch:
+			if !ok {
+				return
+			}
+			j.unstage(uint64(len(chunk.Data)))
+		default:
+			return
+		}
+	}
+}
+
 func (j *job) process() error {
 	if j.conn == nil {
 		panic("nil connection")
@@ -174,21 +224,26 @@ func (j *job) process() error {
 }
 
 func (j *job) streamSnapshot() error {
+	var last *pb.Chunk
 	for {
 		select {
 		case <-j.stopc:
 			plog.Warningf("stream snapshot to %s stopped", dn(j.shardID, j.replicaID))
+			j.abort(last)
 			return ErrStopped
 		case chunk := <-j.ch:
 			chunk.DeploymentId = j.deploymentID
 			if chunk.IsPoisonChunk() {
 				return ErrStreamSnapshot
 			}
-			if err := j.sendChunk(chunk, j.conn); err != nil {
+			err := j.sendChunk(chunk, j.conn)
+			j.unstage(uint64(len(chunk.Data)))
+			if err != nil {
 				plog.Errorf("streaming snapshot chunk to %s failed, %v",
 					dn(chunk.ShardID, chunk.ReplicaID), err)
 				return err
 			}
+			last = &chunk
 			if chunk.ChunkCount == pb.LastChunkCount {
 				plog.Debugf("node %d just sent all chunks to %s",
 					chunk.From, dn(chunk.ShardID, chunk.ReplicaID))
@@ -219,14 +274,18 @@ func (j *job) sendSnapshot() error {
 
 func (j *job) sendChunks(chunks []pb.Chunk) error {
 	chunkData := make([]byte, snapshotChunkSize)
-	for _, chunk := range chunks {
+	j.stage(snapshotChunkSize)
+	defer j.unstage(snapshotChunkSize)
+	var last *pb.Chunk
+	for idx, chunk := range chunks {
 		select {
 		case <-j.stopc:
+			j.abort(last)
 			return ErrStopped
 		default:
 		}
 		chunk.DeploymentId = j.deploymentID
-		if !chunk.Witness {
+		if !chunk.Witness && !chunk.IsSideloaded() {
 			// TODO: add a test for such error
 			// TODO: add a test to show that failed sendChunks for other reasons will
 			// 			 be reported
@@ -242,12 +301,38 @@ func (j *job) sendChunks(chunks []pb.Chunk) error {
 		if f := j.postSend.Load(); f != nil {
 			f.(func(pb.Chunk))(chunk)
 		}
+		last = &chunks[idx]
 	}
 	return nil
 }
 
+// abort tells the remote node to discard the partially received snapshot, it
+// is a no-op when no chunk has been sent.
+func (j *job) abort(last *pb.Chunk) {
+	if last == nil {
+		return
+	}
+	chunk := pb.Chunk{
+		DeploymentId: j.deploymentID,
+		BinVer:       last.BinVer,
+		ShardID:      last.ShardID,
+		ReplicaID:    last.ReplicaID,
+		From:         last.From,
+		Index:        last.Index,
+		Term:         last.Term,
+		ChunkCount:   pb.AbortChunkCount,
+	}
+	if err := j.conn.SendChunk(chunk); err != nil {
+		plog.Debugf("failed to send the abort chunk to %s, %v",
+			dn(chunk.ShardID, chunk.ReplicaID), err)
+	}
+}
+
 func (j *job) sendChunk(c pb.Chunk,
 	conn raftio.ISnapshotConnection) error {
+	if err := j.fc.wait(c); err != nil {
+		return err
+	}
 	if f := j.preSend.Load(); f != nil {
 		updated, shouldSend := f.(StreamChunkSendFunc)(c)
 		if !shouldSend {
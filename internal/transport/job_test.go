@@ -16,6 +16,7 @@ package transport
 
 import (
 	"context"
+	"sync/atomic"
 	"testing"
 
 	"github.com/lni/goutils/syncutil"
@@ -150,3 +151,66 @@ func TestLastChunkCanStopTheProcessLoop(t *testing.T) {
 	fs := vfs.GetTestFS()
 	testSpecialChunkCanStopTheProcessLoop(t, pb.LastChunkCount, nil, fs)
 }
+
+func TestStoppedStreamingJobSendsAbortChunk(t *testing.T) {
+	fs := vfs.GetTestFS()
+	cfg := config.NodeHostConfig{}
+	transport := NewNOOPTransport(cfg, nil, nil)
+	stopc := make(chan struct{})
+	c := newJob(context.Background(), 1, 1, 1, true, 0, transport, stopc, fs)
+	if err := c.connect("a1"); err != nil {
+		t.Fatalf("connect failed %v", err)
+	}
+	sent := make(chan struct{}, 1)
+	c.preSend.Store(StreamChunkSendFunc(func(c pb.Chunk) (pb.Chunk, bool) {
+		sent <- struct{}{}
+		return c, true
+	}))
+	stopper := syncutil.NewStopper()
+	var perr error
+	stopper.RunWorker(func() {
+		perr = c.process()
+	})
+	if ok, _ := c.AddChunk(pb.Chunk{ChunkCount: 2}); !ok {
+		t.Fatalf("failed to send")
+	}
+	<-sent
+	close(stopc)
+	stopper.Stop()
+	if perr != ErrStopped {
+		t.Errorf("unexpected error val %v", perr)
+	}
+	noopConn, ok := c.conn.(*NOOPSnapshotConnection)
+	if !ok {
+		t.Fatalf("failed to get noopConn")
+	}
+	if noopConn.sendChunksCount != 2 {
+		t.Errorf("abort chunk not sent, count %d", noopConn.sendChunksCount)
+	}
+}
+
+func TestStagedChunksAreReleasedWhenJobIsFinished(t *testing.T) {
+	fs := vfs.GetTestFS()
+	transport := NewNOOPTransport(config.NodeHostConfig{}, nil, nil)
+	c := newJob(context.Background(), 1, 1, 1, true, 0, transport, nil, fs)
+	staged := uint64(0)
+	c.staged = &staged
+	for i := 0; i < 3; i++ {
+		if sent, _ := c.AddChunk(pb.Chunk{Data: make([]byte, 1024)}); !sent {
+			t.Fatalf("failed to add chunk")
+		}
+	}
+	if v := atomic.LoadUint64(&staged); v != 3*1024 {
+		t.Errorf("staged %d, want %d", v, 3*1024)
+	}
+	c.finish()
+	if v := atomic.LoadUint64(&staged); v != 0 {
+		t.Errorf("staged %d after finish", v)
+	}
+	if sent, _ := c.AddChunk(pb.Chunk{Data: make([]byte, 1024)}); !sent {
+		t.Fatalf("failed to add chunk")
+	}
+	if v := atomic.LoadUint64(&staged); v != 0 {
+		t.Errorf("staged %d after finish", v)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// When Expert.TransportMisdeliveryReport is enabled, the receiving side of a
+// message connection replies messages targeting replicas unknown to it with
+// an unknown target frame that has the following layout -
+//
+//	| unknownTargetNumber (2) | shardID (8) | replicaID (8) |
+//
+// Unknown target frames are sent at most once per unknownTargetInterval for
+// each target on the same connection. They are read by the sending side of
+// the connection and reported as MisdeliveredMessage system events.
+
+const (
+	unknownTargetFrameSize = 18
+)
+
+var (
+	unknownTargetNumber = [2]byte{0xAE, 0x84}
+	// unknownTargetInterval is the minimum interval between two unknown target
+	// frames sent for the same target on the same connection.
+	unknownTargetInterval = time.Second
+)
+
+// IReplicaLookup is the optional interface implemented by IMessageHandler
+// instances that can tell whether a replica is managed by the local NodeHost.
+type IReplicaLookup interface {
+	// HasReplica returns a boolean value indicating whether the specified
+	// replica is managed by the local NodeHost.
+	HasReplica(shardID uint64, replicaID uint64) bool
+}
+
+func encodeUnknownTarget(buf []byte, shardID uint64, replicaID uint64) []byte {
+	if len(buf) < unknownTargetFrameSize {
+		panic("input buf too small")
+	}
+	copy(buf, unknownTargetNumber[:])
+	binary.BigEndian.PutUint64(buf[2:], shardID)
+	binary.BigEndian.PutUint64(buf[10:], replicaID)
+	return buf[:unknownTargetFrameSize]
+}
+
+func decodeUnknownTarget(buf []byte) (uint64, uint64) {
+	return binary.BigEndian.Uint64(buf[2:]), binary.BigEndian.Uint64(buf[10:])
+}
+
+// unknownTargets tracks the unknown targets reported on a connection.
+type unknownTargets struct {
+	reported map[raftio.NodeInfo]time.Time
+	buf      []byte
+}
+
+// reportUnknownTargets sends unknown target frames for messages in the batch that target
+// replicas unknown to the local NodeHost.
+func (t *TCP) reportUnknownTargets(conn net.Conn,
+	batch pb.MessageBatch, ut *unknownTargets) error {
+	if t.hasTarget == nil {
+		return nil
+	}
+	now := time.Now()
+	for _, req := range batch.Requests {
+		if t.hasTarget(req.ShardID, req.To) {
+			continue
+		}
+		ni := raftio.NodeInfo{ShardID: req.ShardID, ReplicaID: req.To}
+		if ut.reported == nil {
+			ut.reported = make(map[raftio.NodeInfo]time.Time)
+			ut.buf = make([]byte, unknownTargetFrameSize)
+		}
+		if tt, ok := ut.reported[ni]; ok && now.Sub(tt) < unknownTargetInterval {
+			continue
+		}
+		ut.reported[ni] = now
+		plog.Warningf("message from %s to unknown target %s",
+			batch.SourceAddress, dn(req.ShardID, req.To))
+		frame := encodeUnknownTarget(ut.buf, req.ShardID, req.To)
+		if err := sendPoison(conn, frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
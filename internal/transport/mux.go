@@ -0,0 +1,647 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/lni/goutils/syncutil"
+)
+
+// Multiplexed sessions allow raft messages and snapshot chunks sent to the
+// same remote NodeHost to share a single TCP connection. A session is
+// requested by the dialing side by sending the muxHelloNumber in place of the
+// magic number of the first message, the remote side replies with the same
+// bytes when multiplexing is supported and enabled. Once established, each
+// message or snapshot connection is a stream in the session and all traffic is
+// carried in frames with the following layout -
+//
+//	| kind (1) | stream id (4) | payload size (4) | header crc32 (4) | payload |
+//
+// Streams opened for sending snapshot chunks are in the low priority lane,
+// their frames are only written when there is no pending frame from the high
+// priority lane used by raft messages. Each stream has its own flow control
+// window so a slow snapshot receiver never blocks raft messages.
+
+const (
+	muxFrameHeaderSize        = 13
+	muxMaxFrameSize    uint32 = 64 * 1024
+	muxWindowSize      uint32 = 4 * 1024 * 1024
+	muxOpen            uint8  = 1
+	muxData            uint8  = 2
+	muxClose           uint8  = 3
+	muxWindow          uint8  = 4
+	muxMessageLane     uint8  = 1
+	muxSnapshotLane    uint8  = 2
+)
+
+var (
+	muxHelloNumber   = [2]byte{0xAE, 0x7F}
+	muxRejectNumber  = [2]byte{0xAE, 0x80}
+	muxRetryInterval = time.Minute
+	muxQueueSize     = 64
+	// errMuxHelloReceived is the error returned by readMagicNumber when the
+	// remote side is requesting a multiplexed session.
+	errMuxHelloReceived = errors.New("multiplexing hello received")
+	// errMuxNotSupported is the error returned when the remote NodeHost does
+	// not support or has not enabled multiplexing.
+	errMuxNotSupported = errors.New("multiplexing not supported by remote")
+	// errSessionClosed is the error returned when the multiplexed session has
+	// been closed.
+	errSessionClosed = errors.New("multiplexed session closed")
+)
+
+type muxFrameHeader struct {
+	kind   uint8
+	stream uint32
+	size   uint32
+}
+
+func (h *muxFrameHeader) encode(buf []byte) []byte {
+	if len(buf) < muxFrameHeaderSize {
+		panic("input buf too small")
+	}
+	buf[0] = h.kind
+	binary.BigEndian.PutUint32(buf[1:], h.stream)
+	binary.BigEndian.PutUint32(buf[5:], h.size)
+	binary.BigEndian.PutUint32(buf[9:], crc32.ChecksumIEEE(buf[:9]))
+	return buf[:muxFrameHeaderSize]
+}
+
+func (h *muxFrameHeader) decode(buf []byte) bool {
+	if len(buf) < muxFrameHeaderSize {
+		return false
+	}
+	if crc32.ChecksumIEEE(buf[:9]) != binary.BigEndian.Uint32(buf[9:]) {
+		plog.Errorf("mux frame header crc check failed")
+		return false
+	}
+	kind := buf[0]
+	if kind < muxOpen || kind > muxWindow {
+		plog.Errorf("invalid mux frame kind")
+		return false
+	}
+	size := binary.BigEndian.Uint32(buf[5:])
+	if size > muxMaxFrameSize {
+		plog.Errorf("invalid mux frame size")
+		return false
+	}
+	h.kind = kind
+	h.stream = binary.BigEndian.Uint32(buf[1:])
+	h.size = size
+	return true
+}
+
+type muxFrame struct {
+	header  muxFrameHeader
+	payload []byte
+	done    chan error
+}
+
+// muxSession is a multiplexed session over a single connection.
+type muxSession struct {
+	conn         net.Conn
+	onOpen       func(*muxStream)
+	hi           chan *muxFrame
+	lo           chan *muxFrame
+	stopc        chan struct{}
+	closeOnce    sync.Once
+	writeTimeout time.Duration
+	lastRecv     int64
+	client       bool
+	mu           struct {
+		sync.Mutex
+		streams map[uint32]*muxStream
+		err     error
+		next    uint32
+	}
+}
+
+func newMuxSession(conn net.Conn, client bool,
+	writeTimeout time.Duration, onOpen func(*muxStream)) *muxSession {
+	s := &muxSession{
+		conn:         conn,
+		onOpen:       onOpen,
+		hi:           make(chan *muxFrame, muxQueueSize),
+		lo:           make(chan *muxFrame, muxQueueSize),
+		stopc:        make(chan struct{}),
+		writeTimeout: writeTimeout,
+		lastRecv:     time.Now().UnixNano(),
+		client:       client,
+	}
+	s.mu.streams = make(map[uint32]*muxStream)
+	return s
+}
+
+// start starts the worker goroutines of the session. The session is closed
+// when the specified stopc channel is closed.
+func (s *muxSession) start(stopper *syncutil.Stopper, stopc <-chan struct{}) {
+	stopper.RunWorker(func() {
+		select {
+		case <-stopc:
+			s.fail(errSessionClosed)
+		case <-s.stopc:
+		}
+	})
+	stopper.RunWorker(func() {
+		s.writeLoop()
+	})
+	stopper.RunWorker(func() {
+		s.readLoop()
+	})
+}
+
+func (s *muxSession) closed() bool {
+	select {
+	case <-s.stopc:
+		return true
+	default:
+	}
+	return false
+}
+
+func (s *muxSession) error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mu.err
+}
+
+func (s *muxSession) fail(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.mu.err = err
+		streams := make([]*muxStream, 0, len(s.mu.streams))
+		for _, st := range s.mu.streams {
+			streams = append(streams, st)
+		}
+		s.mu.Unlock()
+		close(s.stopc)
+		if cerr := s.conn.Close(); cerr != nil {
+			plog.Debugf("failed to close the connection %v", cerr)
+		}
+		for _, st := range streams {
+			st.notify()
+		}
+	})
+}
+
+// stalled is called when a read on a stream of the client side session timed
+// out. The session is considered as dead when nothing has been received since
+// the read deadline was armed.
+func (s *muxSession) stalled(armed time.Time) {
+	if s.client && atomic.LoadInt64(&s.lastRecv) < armed.UnixNano() {
+		plog.Warningf("multiplexed session to %s stalled", s.conn.RemoteAddr())
+		s.fail(os.ErrDeadlineExceeded)
+	}
+}
+
+func (s *muxSession) open(lane uint8) (*muxStream, error) {
+	s.mu.Lock()
+	if s.mu.err != nil {
+		s.mu.Unlock()
+		return nil, errSessionClosed
+	}
+	s.mu.next++
+	st := newMuxStream(s, s.mu.next, lane)
+	s.mu.streams[st.id] = st
+	s.mu.Unlock()
+	if err := s.send(muxMessageLane,
+		muxOpen, st.id, []byte{lane}, time.Time{}); err != nil {
+		s.removeStream(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *muxSession) getStream(id uint32) *muxStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mu.streams[id]
+}
+
+func (s *muxSession) addStream(id uint32, lane uint8) (*muxStream, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.mu.streams[id]; ok {
+		return nil, false
+	}
+	st := newMuxStream(s, id, lane)
+	s.mu.streams[id] = st
+	return st, true
+}
+
+// removeStream removes the specified stream from the session, the client
+// side session is closed once it no longer has any stream.
+func (s *muxSession) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.mu.streams, id)
+	idle := s.client && len(s.mu.streams) == 0
+	if idle && s.mu.err == nil {
+		s.mu.err = errSessionClosed
+	}
+	s.mu.Unlock()
+	if idle {
+		s.fail(errSessionClosed)
+	}
+}
+
+// send queues the frame in the specified lane and waits for it to be written.
+func (s *muxSession) send(lane uint8, kind uint8,
+	id uint32, payload []byte, deadline time.Time) error {
+	f := &muxFrame{
+		header:  muxFrameHeader{kind: kind, stream: id, size: uint32(len(payload))},
+		payload: payload,
+		done:    make(chan error, 1),
+	}
+	q := s.hi
+	if lane == muxSnapshotLane {
+		q = s.lo
+	}
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case q <- f:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-s.stopc:
+		return errSessionClosed
+	}
+	// the payload is owned by the caller, always wait for the queued frame to
+	// be handled by the writeLoop
+	select {
+	case err := <-f.done:
+		return err
+	case <-s.stopc:
+		return errSessionClosed
+	}
+}
+
+// sendControl queues the control frame without waiting for it to be written.
+func (s *muxSession) sendControl(kind uint8, id uint32, payload []byte) {
+	f := &muxFrame{
+		header:  muxFrameHeader{kind: kind, stream: id, size: uint32(len(payload))},
+		payload: payload,
+	}
+	select {
+	case s.hi <- f:
+	case <-s.stopc:
+	}
+}
+
+func (s *muxSession) writeLoop() {
+	header := make([]byte, muxFrameHeaderSize)
+	for {
+		var f *muxFrame
+		select {
+		case f = <-s.hi:
+		default:
+			select {
+			case f = <-s.hi:
+			case f = <-s.lo:
+			case <-s.stopc:
+				return
+			}
+		}
+		err := s.writeFrame(f, header)
+		if f.done != nil {
+			f.done <- err
+		}
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+func (s *muxSession) writeFrame(f *muxFrame, header []byte) error {
+	tt := time.Now().Add(s.writeTimeout)
+	if err := s.conn.SetWriteDeadline(tt); err != nil {
+		return err
+	}
+	if _, err := s.conn.Write(f.header.encode(header)); err != nil {
+		return err
+	}
+	if len(f.payload) > 0 {
+		if _, err := s.conn.Write(f.payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *muxSession) readLoop() {
+	header := make([]byte, muxFrameHeaderSize)
+	buf := make([]byte, muxMaxFrameSize)
+	for {
+		if err := s.readFrame(header, buf); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+func (s *muxSession) readFrame(header []byte, buf []byte) error {
+	// dead connections are detected by TCP keepalive and pings sent on streams
+	if err := s.conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(s.conn, header); err != nil {
+		return err
+	}
+	h := muxFrameHeader{}
+	if !h.decode(header) {
+		return ErrBadMessage
+	}
+	payload := buf[:h.size]
+	if _, err := io.ReadFull(s.conn, payload); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+	switch h.kind {
+	case muxOpen:
+		if s.client || len(payload) != 1 {
+			return ErrBadMessage
+		}
+		st, ok := s.addStream(h.stream, payload[0])
+		if !ok {
+			return ErrBadMessage
+		}
+		s.onOpen(st)
+	case muxData:
+		if st := s.getStream(h.stream); st != nil {
+			if !st.receive(payload) {
+				plog.Errorf("mux stream %d exceeded its window", h.stream)
+				return ErrBadMessage
+			}
+		}
+	case muxClose:
+		if st := s.getStream(h.stream); st != nil {
+			st.remoteClose()
+		}
+	case muxWindow:
+		if len(payload) != 4 {
+			return ErrBadMessage
+		}
+		if st := s.getStream(h.stream); st != nil {
+			st.addCredit(binary.BigEndian.Uint32(payload))
+		}
+	}
+	return nil
+}
+
+// muxStream is a stream in a multiplexed session, it implements the net.Conn
+// interface so it can be used in place of the connection.
+type muxStream struct {
+	session *muxSession
+	readc   chan struct{}
+	writec  chan struct{}
+	id      uint32
+	lane    uint8
+	mu      struct {
+		sync.Mutex
+		buf           bytes.Buffer
+		readDeadline  time.Time
+		readArmed     time.Time
+		writeDeadline time.Time
+		unacked       uint32
+		credit        uint32
+		closed        bool
+		remoteClosed  bool
+	}
+}
+
+var _ net.Conn = (*muxStream)(nil)
+
+func newMuxStream(s *muxSession, id uint32, lane uint8) *muxStream {
+	st := &muxStream{
+		session: s,
+		readc:   make(chan struct{}, 1),
+		writec:  make(chan struct{}, 1),
+		id:      id,
+		lane:    lane,
+	}
+	st.mu.credit = muxWindowSize
+	return st
+}
+
+func (st *muxStream) notify() {
+	select {
+	case st.readc <- struct{}{}:
+	default:
+	}
+	select {
+	case st.writec <- struct{}{}:
+	default:
+	}
+}
+
+func (st *muxStream) receive(data []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.mu.closed {
+		return true
+	}
+	used := uint64(st.mu.buf.Len()) + uint64(st.mu.unacked)
+	if used+uint64(len(data)) > uint64(muxWindowSize) {
+		return false
+	}
+	st.mu.buf.Write(data)
+	st.notify()
+	return true
+}
+
+func (st *muxStream) remoteClose() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.mu.remoteClosed = true
+	st.notify()
+}
+
+func (st *muxStream) addCredit(v uint32) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.mu.credit += v
+	st.notify()
+}
+
+func (st *muxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.session.stopc:
+	}
+	return nil
+}
+
+// Read reads data received on the stream.
+func (st *muxStream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.mu.closed {
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if st.mu.buf.Len() > 0 {
+			n, _ := st.mu.buf.Read(b)
+			st.mu.unacked += uint32(n)
+			update := uint32(0)
+			if st.mu.unacked >= muxWindowSize/2 {
+				update = st.mu.unacked
+				st.mu.unacked = 0
+			}
+			st.mu.Unlock()
+			if update > 0 {
+				payload := make([]byte, 4)
+				binary.BigEndian.PutUint32(payload, update)
+				st.session.sendControl(muxWindow, st.id, payload)
+			}
+			return n, nil
+		}
+		if st.mu.remoteClosed {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.mu.readDeadline
+		armed := st.mu.readArmed
+		st.mu.Unlock()
+		if err := st.session.error(); err != nil {
+			return 0, err
+		}
+		if err := st.wait(st.readc, deadline); err != nil {
+			st.session.stalled(armed)
+			return 0, err
+		}
+	}
+}
+
+// Write writes data to the stream, it blocks until all data is written to the
+// underlying connection.
+func (st *muxStream) Write(b []byte) (int, error) {
+	sent := 0
+	for sent < len(b) {
+		st.mu.Lock()
+		if st.mu.closed {
+			st.mu.Unlock()
+			return sent, net.ErrClosed
+		}
+		if st.mu.remoteClosed {
+			st.mu.Unlock()
+			return sent, io.ErrClosedPipe
+		}
+		deadline := st.mu.writeDeadline
+		if st.mu.credit == 0 {
+			st.mu.Unlock()
+			if err := st.session.error(); err != nil {
+				return sent, err
+			}
+			if err := st.wait(st.writec, deadline); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		sz := uint32(len(b) - sent)
+		if sz > st.mu.credit {
+			sz = st.mu.credit
+		}
+		if sz > muxMaxFrameSize {
+			sz = muxMaxFrameSize
+		}
+		st.mu.credit -= sz
+		st.mu.Unlock()
+		data := b[sent : sent+int(sz)]
+		if err := st.session.send(st.lane,
+			muxData, st.id, data, deadline); err != nil {
+			return sent, err
+		}
+		sent += int(sz)
+	}
+	return sent, nil
+}
+
+// Close closes the stream.
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.mu.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.mu.closed = true
+	st.notify()
+	st.mu.Unlock()
+	st.session.sendControl(muxClose, st.id, nil)
+	st.session.removeStream(st.id)
+	return nil
+}
+
+// LocalAddr returns the local address of the underlying connection.
+func (st *muxStream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection.
+func (st *muxStream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+// SetDeadline sets both the read and write deadlines of the stream.
+func (st *muxStream) SetDeadline(t time.Time) error {
+	if err := st.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the stream.
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.mu.readDeadline = t
+	st.mu.readArmed = time.Now()
+	st.notify()
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline of the stream.
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.mu.writeDeadline = t
+	st.notify()
+	return nil
+}
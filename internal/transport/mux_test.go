@@ -0,0 +1,120 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/goutils/syncutil"
+)
+
+func TestMuxFrameHeaderCanBeEncodedAndDecoded(t *testing.T) {
+	h := muxFrameHeader{
+		kind:   muxData,
+		stream: 1234,
+		size:   muxMaxFrameSize,
+	}
+	buf := make([]byte, muxFrameHeaderSize)
+	result := h.encode(buf)
+	if len(result) != muxFrameHeaderSize {
+		t.Fatalf("unexpected size")
+	}
+	hh := muxFrameHeader{}
+	if !hh.decode(result) {
+		t.Fatalf("decode failed")
+	}
+	if !reflect.DeepEqual(&h, &hh) {
+		t.Errorf("mux frame header changed")
+	}
+	binary.BigEndian.PutUint32(result[1:], 4321)
+	if hh.decode(result) {
+		t.Fatalf("crc error not reported")
+	}
+}
+
+func TestInvalidMuxFrameHeaderIsReported(t *testing.T) {
+	tests := []muxFrameHeader{
+		{kind: 0, stream: 1, size: 1},
+		{kind: muxWindow + 1, stream: 1, size: 1},
+		{kind: muxData, stream: 1, size: muxMaxFrameSize + 1},
+	}
+	for idx, h := range tests {
+		buf := make([]byte, muxFrameHeaderSize)
+		hh := muxFrameHeader{}
+		if hh.decode(h.encode(buf)) {
+			t.Errorf("%d, invalid header not reported", idx)
+		}
+	}
+}
+
+func TestMuxStreamDataLargerThanWindowCanBeTransferred(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := syncutil.NewStopper()
+	defer stopper.Stop()
+	c1, c2 := net.Pipe()
+	streamc := make(chan *muxStream, 1)
+	server := newMuxSession(c2, false, time.Second, func(st *muxStream) {
+		streamc <- st
+	})
+	server.start(stopper, stopper.ShouldStop())
+	client := newMuxSession(c1, true, time.Second, nil)
+	client.start(stopper, stopper.ShouldStop())
+	st, err := client.open(muxSnapshotLane)
+	if err != nil {
+		t.Fatalf("failed to open stream %v", err)
+	}
+	data := make([]byte, 3*muxWindowSize+1)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("%v", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := st.Write(data)
+		errc <- err
+	}()
+	rst := <-streamc
+	if rst.lane != muxSnapshotLane {
+		t.Errorf("unexpected lane %d", rst.lane)
+	}
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(rst, received); err != nil {
+		t.Fatalf("failed to read %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to write %v", err)
+	}
+	if !bytes.Equal(data, received) {
+		t.Errorf("data changed")
+	}
+	if err := st.Close(); err != nil {
+		t.Fatalf("failed to close the stream %v", err)
+	}
+	// the client session is closed once it becomes idle
+	<-client.stopc
+	if _, err := rst.Read(received); err == nil {
+		t.Errorf("read on closed session didn't fail")
+	}
+	if _, err := client.open(muxMessageLane); err != errSessionClosed {
+		t.Errorf("unexpected error %v", err)
+	}
+}
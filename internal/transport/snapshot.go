@@ -38,7 +38,6 @@ import (
 
 	"github.com/cockroachdb/errors"
 
-	"github.com/lni/dragonboat/v4/internal/rsm"
 	"github.com/lni/dragonboat/v4/internal/settings"
 	"github.com/lni/dragonboat/v4/internal/vfs"
 	"github.com/lni/dragonboat/v4/raftio"
@@ -109,10 +108,17 @@ func (t *Transport) doSendSnapshot(m pb.Message) bool {
 	if m.Type != pb.InstallSnapshot {
 		panic("not a snapshot message")
 	}
-	chunks, err := splitSnapshotMessage(m, t.fs)
-	if err != nil {
-		plog.Errorf("failed to get snapshot chunks %+v", err)
-		return false
+	if m.Snapshot.Witness {
+		panic("witness snapshot must be sent as a regular message")
+	}
+	chunks, ok := t.getSideloadChunk(m)
+	if !ok {
+		var err error
+		chunks, err = splitSnapshotMessage(m, t.fs)
+		if err != nil {
+			plog.Errorf("failed to get snapshot chunks %+v", err)
+			return false
+		}
 	}
 	addr, _, err := t.resolver.Resolve(shardID, toReplicaID)
 	if err != nil {
@@ -141,8 +147,48 @@ func (t *Transport) doSendSnapshot(m pb.Message) bool {
 	return true
 }
 
+// getSideloadChunk returns the locator chunk when the snapshot can be
+// sideloaded. The same snapshot is only offered once to each remote node, it
+// is streamed as usual when it has to be sent again, e.g. when the remote node
+// failed to fetch it.
+func (t *Transport) getSideloadChunk(m pb.Message) ([]pb.Chunk, bool) {
+	sideloader := t.nhConfig.SnapshotSideloader
+	if sideloader == nil || len(m.Snapshot.Files) > 0 {
+		return nil, false
+	}
+	key := raftio.GetNodeInfo(m.ShardID, m.To)
+	t.mu.Lock()
+	offered, ok := t.mu.sideloaded[key]
+	delete(t.mu.sideloaded, key)
+	t.mu.Unlock()
+	if ok && offered == m.Snapshot.Index {
+		return nil, false
+	}
+	locator, ok := sideloader.Offer(raftio.SnapshotMeta{
+		ShardID:   m.ShardID,
+		ReplicaID: m.To,
+		From:      m.From,
+		Index:     m.Snapshot.Index,
+		Term:      m.Snapshot.Term,
+		Filepath:  m.Snapshot.Filepath,
+		FileSize:  m.Snapshot.FileSize,
+	})
+	if !ok || len(locator) == 0 {
+		return nil, false
+	}
+	t.mu.Lock()
+	t.mu.sideloaded[key] = m.Snapshot.Index
+	t.mu.Unlock()
+	plog.Infof("sideloading snapshot %d to %s using %s",
+		m.Snapshot.Index, dn(m.ShardID, m.To), locator)
+	return []pb.Chunk{getSideloadChunk(m, locator)}, true
+}
+
 func (t *Transport) createJob(key raftio.NodeInfo,
 	addr string, streaming bool, sz int) *job {
+	if t.stopping() {
+		return nil
+	}
 	if v := atomic.AddUint64(&t.jobs, 1); v > maxConnectionCount {
 		r := atomic.AddUint64(&t.jobs, ^uint64(0))
 		plog.Warningf("job count is rate limited %d", r)
@@ -152,15 +198,26 @@ func (t *Transport) createJob(key raftio.NodeInfo,
 		streaming, sz, t.trans, t.stopper.ShouldStop(), t.fs)
 	job.postSend = t.postSend
 	job.preSend = t.preSend
+	job.maxUnacked = t.nhConfig.Expert.MaxUnackedSnapshotBytes
+	job.staged = &t.stagedBytes
 	return job
 }
 
+// GetSnapshotStagingBytes returns the total size of snapshot chunk data held
+// in memory by snapshot jobs, i.e. chunks of streamed snapshots waiting to be
+// sent and buffers used for reading chunks of snapshot files.
+func (t *Transport) GetSnapshotStagingBytes() uint64 {
+	return atomic.LoadUint64(&t.stagedBytes)
+}
+
 func (t *Transport) processSnapshot(c *job, addr string) {
+	defer c.finish()
 	breaker := t.GetCircuitBreaker(addr)
 	successes := breaker.Successes()
 	consecFailures := breaker.ConsecFailures()
 	shardID := c.shardID
 	replicaID := c.replicaID
+	stats := t.stats.get(addr)
 	if err := func() error {
 		if err := c.connect(addr); err != nil {
 			plog.Warningf("failed to get snapshot conn to %s", dn(shardID, replicaID))
@@ -171,6 +228,7 @@ func (t *Transport) processSnapshot(c *job, addr string) {
 		}
 		defer c.close()
 		breaker.Success()
+		stats.connectionEstablished()
 		if successes == 0 || consecFailures > 0 {
 			plog.Debugf("snapshot stream to %s (%s) established",
 				dn(shardID, replicaID), addr)
@@ -185,6 +243,8 @@ func (t *Transport) processSnapshot(c *job, addr string) {
 	}(); err != nil {
 		plog.Warningf("processSnapshot failed: %v", err)
 		breaker.Fail()
+		stats.connectionFailed()
+		stats.setError(err)
 		t.sysEvents.ConnectionFailed(addr, true)
 	}
 }
@@ -232,6 +292,7 @@ func splitBySnapshotFile(msg pb.Message,
 			Filepath:       filepath,
 			FileSize:       filesize,
 			Witness:        msg.Snapshot.Witness,
+			Fingerprint:    msg.Snapshot.Fingerprint,
 		}
 		if sf != nil {
 			c.HasFileInfo = true
@@ -259,13 +320,8 @@ func getChunks(m pb.Message) []pb.Chunk {
 	return results
 }
 
-func getWitnessChunk(m pb.Message, fs vfs.IFS) ([]pb.Chunk, error) {
-	ss, err := rsm.GetWitnessSnapshot(fs)
-	if err != nil {
-		return nil, err
-	}
-	results := make([]pb.Chunk, 0)
-	results = append(results, pb.Chunk{
+func getSideloadChunk(m pb.Message, locator string) pb.Chunk {
+	return pb.Chunk{
 		BinVer:         raftio.TransportBinVersion,
 		ShardID:        m.ShardID,
 		ReplicaID:      m.To,
@@ -274,26 +330,21 @@ func getWitnessChunk(m pb.Message, fs vfs.IFS) ([]pb.Chunk, error) {
 		FileChunkCount: 1,
 		ChunkId:        0,
 		ChunkCount:     1,
-		ChunkSize:      uint64(len(ss)),
 		Index:          m.Snapshot.Index,
 		Term:           m.Snapshot.Term,
-		OnDiskIndex:    0,
+		OnDiskIndex:    m.Snapshot.OnDiskIndex,
 		Membership:     m.Snapshot.Membership,
-		Filepath:       "witness.snapshot",
-		FileSize:       uint64(len(ss)),
-		Witness:        true,
-		Data:           ss,
-	})
-	return results, nil
+		Filepath:       m.Snapshot.Filepath,
+		FileSize:       m.Snapshot.FileSize,
+		Locator:        locator,
+		Fingerprint:    m.Snapshot.Fingerprint,
+	}
 }
 
 func splitSnapshotMessage(m pb.Message, fs vfs.IFS) ([]pb.Chunk, error) {
 	if m.Type != pb.InstallSnapshot {
 		panic("not a snapshot message")
 	}
-	if m.Snapshot.Witness {
-		return getWitnessChunk(m, fs)
-	}
 	return getChunks(m), nil
 }
 
@@ -0,0 +1,171 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// When Expert.MaxUnackedSnapshotBytes is set, the sending side of a snapshot
+// connection stops sending chunks once the chunk data not yet acknowledged by
+// the remote side reaches MaxUnackedSnapshotBytes. It then requests an ack by
+// sending the snapshotAckNumber on the connection, the remote side replies
+// with an ack frame that has the following layout -
+//
+//	| snapshotAckNumber (2) | bytes (8) |
+//
+// Ack requests are processed by the remote side after all chunks previously
+// sent on the same connection have been written to the snapshot file and the
+// file has been fsynced, bytes is the total size of such chunk data. A single
+// chunk is always allowed after each ack so chunks larger than the limit can
+// still be sent.
+//
+// A received snapshot is only recovered from once all of its chunks have been
+// received and validated, the ack thus bounds the snapshot data buffered in
+// the network and in memory, it doesn't bound the size of the temporary
+// snapshot directory on the receiving side.
+
+const (
+	snapshotAckFrameSize = 10
+)
+
+var (
+	snapshotAckNumber       = [2]byte{0xAE, 0x85}
+	errSnapshotAckRequested = errors.New("snapshot ack requested")
+	// snapshotAckDuration is the maximum amount of time to wait for an ack,
+	// it includes the time required by the remote side to persist all unacked
+	// chunks.
+	snapshotAckDuration = 30 * time.Second
+)
+
+// acknowledged is the interface implemented by snapshot connections that
+// support acks of the chunk data consumed by the remote side.
+type acknowledged interface {
+	// Ack waits until all chunks sent on the connection have been persisted by
+	// the remote side and returns the total size of their data.
+	Ack() (uint64, error)
+}
+
+func encodeSnapshotAck(buf []byte, consumed uint64) []byte {
+	if len(buf) < snapshotAckFrameSize {
+		panic("input buf too small")
+	}
+	copy(buf, snapshotAckNumber[:])
+	binary.BigEndian.PutUint64(buf[2:], consumed)
+	return buf[:snapshotAckFrameSize]
+}
+
+func decodeSnapshotAck(buf []byte) (uint64, bool) {
+	if len(buf) < snapshotAckFrameSize {
+		return 0, false
+	}
+	if !bytes.Equal(buf[:len(snapshotAckNumber)], snapshotAckNumber[:]) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(buf[2:]), true
+}
+
+// Ack requests the remote node to acknowledge all chunks sent so far.
+func (c *TCPSnapshotConnection) Ack() (uint64, error) {
+	tt := time.Now().Add(writeDuration)
+	if err := c.conn.SetWriteDeadline(tt); err != nil {
+		return 0, err
+	}
+	if _, err := c.conn.Write(snapshotAckNumber[:]); err != nil {
+		return 0, err
+	}
+	if err := c.conn.SetReadDeadline(time.Now().Add(snapshotAckDuration)); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, snapshotAckFrameSize)
+	if _, err := io.ReadFull(c.conn, buf); err != nil {
+		return 0, err
+	}
+	consumed, ok := decodeSnapshotAck(buf)
+	if !ok {
+		return 0, ErrBadMessage
+	}
+	return consumed, nil
+}
+
+// sendSnapshotAck replies the ack request once the last received chunk has
+// been persisted.
+func (t *TCP) sendSnapshotAck(conn net.Conn,
+	last *pb.Chunk, consumed uint64) error {
+	if last != nil && t.syncChunk != nil {
+		if err := t.syncChunk(*last); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, snapshotAckFrameSize)
+	return sendPoison(conn, encodeSnapshotAck(buf, consumed))
+}
+
+// snapshotFlowControl tracks the chunk data sent on a snapshot connection
+// that has not been acknowledged by the remote side. A nil
+// *snapshotFlowControl allows everything to be sent.
+type snapshotFlowControl struct {
+	conn  acknowledged
+	limit uint64
+	sent  uint64
+	acked uint64
+}
+
+func newSnapshotFlowControl(conn raftio.ISnapshotConnection,
+	limit uint64) *snapshotFlowControl {
+	if limit == 0 {
+		return nil
+	}
+	ac, ok := conn.(acknowledged)
+	if !ok {
+		return nil
+	}
+	return &snapshotFlowControl{conn: ac, limit: limit}
+}
+
+// unacked returns the size of chunk data sent but not yet acknowledged.
+func (fc *snapshotFlowControl) unacked() uint64 {
+	return fc.sent - fc.acked
+}
+
+// wait blocks until the specified chunk can be sent without exceeding the
+// limit of unacked chunk data.
+func (fc *snapshotFlowControl) wait(chunk pb.Chunk) error {
+	if fc == nil {
+		return nil
+	}
+	sz := uint64(len(chunk.Data))
+	if fc.unacked() > 0 && fc.unacked()+sz > fc.limit {
+		acked, err := fc.conn.Ack()
+		if err != nil {
+			return err
+		}
+		if acked > fc.sent {
+			return ErrBadMessage
+		}
+		fc.acked = acked
+	}
+	fc.sent += sz
+	return nil
+}
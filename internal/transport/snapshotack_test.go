@@ -0,0 +1,110 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"testing"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+type testAckConnection struct {
+	NOOPSnapshotConnection
+	consumed uint64
+	acks     uint64
+}
+
+func (c *testAckConnection) Ack() (uint64, error) {
+	c.acks++
+	return c.consumed, nil
+}
+
+func TestSnapshotAckCanBeEncodedAndDecoded(t *testing.T) {
+	buf := encodeSnapshotAck(make([]byte, snapshotAckFrameSize), 12345)
+	if len(buf) != snapshotAckFrameSize {
+		t.Fatalf("unexpected frame size %d", len(buf))
+	}
+	v, ok := decodeSnapshotAck(buf)
+	if !ok || v != 12345 {
+		t.Errorf("failed to decode, %t, %d", ok, v)
+	}
+	if _, ok := decodeSnapshotAck(buf[:snapshotAckFrameSize-1]); ok {
+		t.Errorf("short frame decoded")
+	}
+	buf[0] = 0
+	if _, ok := decodeSnapshotAck(buf); ok {
+		t.Errorf("frame with invalid magic number decoded")
+	}
+}
+
+func TestSnapshotFlowControlIsOnlyUsedWhenSupported(t *testing.T) {
+	if fc := newSnapshotFlowControl(&testAckConnection{}, 0); fc != nil {
+		t.Errorf("unexpected flow control")
+	}
+	if fc := newSnapshotFlowControl(&NOOPSnapshotConnection{}, 100); fc != nil {
+		t.Errorf("unexpected flow control")
+	}
+	if fc := newSnapshotFlowControl(&testAckConnection{}, 100); fc == nil {
+		t.Errorf("flow control not created")
+	}
+	var fc *snapshotFlowControl
+	if err := fc.wait(pb.Chunk{Data: make([]byte, 1024)}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestSnapshotFlowControlWaitsForAck(t *testing.T) {
+	conn := &testAckConnection{}
+	fc := newSnapshotFlowControl(conn, 100)
+	chunk := pb.Chunk{Data: make([]byte, 40)}
+	for i := 0; i < 2; i++ {
+		if err := fc.wait(chunk); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if conn.acks != 0 || fc.unacked() != 80 {
+		t.Fatalf("unexpected acks %d, unacked %d", conn.acks, fc.unacked())
+	}
+	conn.consumed = 80
+	if err := fc.wait(chunk); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if conn.acks != 1 || fc.unacked() != 40 {
+		t.Errorf("unexpected acks %d, unacked %d", conn.acks, fc.unacked())
+	}
+	conn.consumed = 1000
+	if err := fc.wait(pb.Chunk{Data: make([]byte, 80)}); err != ErrBadMessage {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestSnapshotFlowControlAllowsLargeChunk(t *testing.T) {
+	conn := &testAckConnection{}
+	fc := newSnapshotFlowControl(conn, 10)
+	chunk := pb.Chunk{Data: make([]byte, 40)}
+	if err := fc.wait(chunk); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if conn.acks != 0 {
+		t.Errorf("unexpected ack")
+	}
+	conn.consumed = 40
+	if err := fc.wait(chunk); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if conn.acks != 1 || fc.unacked() != 40 {
+		t.Errorf("unexpected acks %d, unacked %d", conn.acks, fc.unacked())
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// PeerStats contains transport statistics of a remote NodeHost.
+type PeerStats struct {
+	// Address is the RaftAddress of the remote NodeHost.
+	Address string
+	// MessagesSent is the number of messages sent to the remote NodeHost.
+	MessagesSent uint64
+	// BytesSent is the number of bytes sent to the remote NodeHost.
+	BytesSent uint64
+	// MessagesReceived is the number of messages received from the remote
+	// NodeHost.
+	MessagesReceived uint64
+	// BytesReceived is the number of bytes received from the remote NodeHost.
+	BytesReceived uint64
+	// QueueLength is the number of messages currently queued for sending.
+	QueueLength uint64
+	// MessagesDropped is the number of messages dropped before they could be
+	// sent, e.g. when the send queue is full.
+	MessagesDropped uint64
+	// ConnectionsEstablished is the number of times connections to the remote
+	// NodeHost have been established.
+	ConnectionsEstablished uint64
+	// ConnectionsFailed is the number of failed connections to the remote
+	// NodeHost.
+	ConnectionsFailed uint64
+	// LastError is the last error observed when connecting or sending to the
+	// remote NodeHost.
+	LastError string
+	// MessagesMisdelivered is the number of messages reported by the remote
+	// NodeHost as targeting replicas unknown to it. Reports are rate limited
+	// by the remote NodeHost, the count is thus a lower bound.
+	MessagesMisdelivered uint64
+	// TimeSinceLastSend is the time elapsed since the last successful send.
+	// It is 0 when nothing has ever been sent to the remote NodeHost.
+	TimeSinceLastSend time.Duration
+	// PausedDuration is the total amount of time entry batches to the remote
+	// NodeHost have been paused by flow control as the remote NodeHost didn't
+	// have enough inbound capacity. It is always 0 when
+	// Expert.TransportFlowControl is not enabled.
+	PausedDuration time.Duration
+}
+
+type peerStats struct {
+	lastError         atomic.Value
+	sentBytes         *metrics.Counter
+	receivedBytes     *metrics.Counter
+	address           string
+	messagesSent      uint64
+	bytesSent         uint64
+	messagesReceived  uint64
+	bytesReceived     uint64
+	messagesDropped   uint64
+	established       uint64
+	failed            uint64
+	misdeliveredCount uint64
+	lastSend          int64
+	paused            int64
+	pausedSince       int64
+}
+
+func (s *peerStats) sent(count uint64, bytes uint64) {
+	atomic.AddUint64(&s.messagesSent, count)
+	atomic.AddUint64(&s.bytesSent, bytes)
+	atomic.StoreInt64(&s.lastSend, time.Now().UnixNano())
+	if s.sentBytes != nil {
+		s.sentBytes.Add(int(bytes))
+	}
+}
+
+func (s *peerStats) received(count uint64, bytes uint64) {
+	atomic.AddUint64(&s.messagesReceived, count)
+	atomic.AddUint64(&s.bytesReceived, bytes)
+	if s.receivedBytes != nil {
+		s.receivedBytes.Add(int(bytes))
+	}
+}
+
+func (s *peerStats) dropped(count uint64) {
+	atomic.AddUint64(&s.messagesDropped, count)
+}
+
+func (s *peerStats) connectionEstablished() {
+	atomic.AddUint64(&s.established, 1)
+}
+
+func (s *peerStats) connectionFailed() {
+	atomic.AddUint64(&s.failed, 1)
+}
+
+func (s *peerStats) misdelivered() {
+	atomic.AddUint64(&s.misdeliveredCount, 1)
+}
+
+func (s *peerStats) pause() {
+	atomic.StoreInt64(&s.pausedSince, time.Now().UnixNano())
+}
+
+func (s *peerStats) resume() {
+	if since := atomic.SwapInt64(&s.pausedSince, 0); since > 0 {
+		atomic.AddInt64(&s.paused, time.Now().UnixNano()-since)
+	}
+}
+
+func (s *peerStats) setError(err error) {
+	if err != nil {
+		s.lastError.Store(err.Error())
+	}
+}
+
+func (s *peerStats) get(queueLength uint64) PeerStats {
+	ps := PeerStats{
+		Address:                s.address,
+		MessagesSent:           atomic.LoadUint64(&s.messagesSent),
+		BytesSent:              atomic.LoadUint64(&s.bytesSent),
+		MessagesReceived:       atomic.LoadUint64(&s.messagesReceived),
+		BytesReceived:          atomic.LoadUint64(&s.bytesReceived),
+		QueueLength:            queueLength,
+		MessagesDropped:        atomic.LoadUint64(&s.messagesDropped),
+		ConnectionsEstablished: atomic.LoadUint64(&s.established),
+		ConnectionsFailed:      atomic.LoadUint64(&s.failed),
+		MessagesMisdelivered:   atomic.LoadUint64(&s.misdeliveredCount),
+	}
+	if v := s.lastError.Load(); v != nil {
+		ps.LastError = v.(string)
+	}
+	if ls := atomic.LoadInt64(&s.lastSend); ls > 0 {
+		ps.TimeSinceLastSend = time.Since(time.Unix(0, ls))
+	}
+	ps.PausedDuration = time.Duration(atomic.LoadInt64(&s.paused))
+	if since := atomic.LoadInt64(&s.pausedSince); since > 0 {
+		ps.PausedDuration += time.Since(time.Unix(0, since))
+	}
+	return ps
+}
+
+// peerStatsRegistry keeps the per remote NodeHost transport statistics.
+type peerStatsRegistry struct {
+	peers      sync.Map
+	useMetrics bool
+}
+
+func (r *peerStatsRegistry) get(addr string) *peerStats {
+	if v, ok := r.peers.Load(addr); ok {
+		return v.(*peerStats)
+	}
+	s := &peerStats{address: addr}
+	if r.useMetrics {
+		name := fmt.Sprintf(`dragonboat_transport_sent_bytes_total{target="%s"}`, addr)
+		s.sentBytes = metrics.GetOrCreateCounter(name)
+		name = fmt.Sprintf(`dragonboat_transport_received_bytes_total{source="%s"}`, addr)
+		s.receivedBytes = metrics.GetOrCreateCounter(name)
+	}
+	v, _ := r.peers.LoadOrStore(addr, s)
+	return v.(*peerStats)
+}
+
+func (r *peerStatsRegistry) getAll(queued map[string]uint64) []PeerStats {
+	result := make([]PeerStats, 0)
+	r.peers.Range(func(k, v interface{}) bool {
+		result = append(result, v.(*peerStats).get(queued[k.(string)]))
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Address < result[j].Address
+	})
+	return result
+}
@@ -21,7 +21,9 @@ import (
 	"encoding/binary"
 	"hash/crc32"
 	"io"
+	"math"
 	"net"
+	"os"
 	"sync"
 	"time"
 
@@ -31,6 +33,7 @@ import (
 
 	"github.com/lni/dragonboat/v4/config"
 	"github.com/lni/dragonboat/v4/internal/settings"
+	"github.com/lni/dragonboat/v4/internal/utils/sockopt"
 	"github.com/lni/dragonboat/v4/raftio"
 	pb "github.com/lni/dragonboat/v4/raftpb"
 )
@@ -40,8 +43,10 @@ var (
 	// corrupted.
 	ErrBadMessage       = errors.New("invalid message")
 	errPoisonReceived   = errors.New("poison received")
+	errPingReceived     = errors.New("ping received")
 	magicNumber         = [2]byte{0xAE, 0x7D}
 	poisonNumber        = [2]byte{0x0, 0x0}
+	pingNumber          = [2]byte{0xAE, 0x7E}
 	payloadBufferSize   = settings.SnapshotChunkSize + 1024*128
 	tlsHandshackTimeout = 10 * time.Second
 	magicNumberDuration = 1 * time.Second
@@ -127,6 +132,10 @@ func sendPoisonAck(conn net.Conn, poisonAck []byte) error {
 	return sendPoison(conn, poisonAck)
 }
 
+func sendPong(conn net.Conn) error {
+	return sendPoison(conn, pingNumber[:])
+}
+
 func waitPoisonAck(conn net.Conn) {
 	ack := make([]byte, len(poisonNumber))
 	tt := time.Now().Add(keepAlivePeriod)
@@ -139,46 +148,18 @@ func waitPoisonAck(conn net.Conn) {
 	}
 }
 
-func writeMessage(conn net.Conn,
-	header requestHeader, buf []byte, headerBuf []byte, encrypted bool) error {
-	header.size = uint64(len(buf))
-	if !encrypted {
-		header.crc = crc32.ChecksumIEEE(buf)
-	}
-	headerBuf = header.encode(headerBuf)
-	tt := time.Now().Add(magicNumberDuration).Add(headerDuration)
-	if err := conn.SetWriteDeadline(tt); err != nil {
-		return err
-	}
-	if _, err := conn.Write(magicNumber[:]); err != nil {
-		return err
+func minInt(a int, b int) int {
+	if a < b {
+		return a
 	}
-	if _, err := conn.Write(headerBuf); err != nil {
-		return err
-	}
-	sent := 0
-	bufSize := int(recvBufSize)
-	for sent < len(buf) {
-		if sent+bufSize > len(buf) {
-			bufSize = len(buf) - sent
-		}
-		tt = time.Now().Add(writeDuration)
-		if err := conn.SetWriteDeadline(tt); err != nil {
-			return err
-		}
-		if _, err := conn.Write(buf[sent : sent+bufSize]); err != nil {
-			return err
-		}
-		sent += bufSize
-	}
-	if sent != len(buf) {
-		plog.Panicf("sent %d, buf len %d", sent, len(buf))
-	}
-	return nil
+	return b
 }
 
-func readMessage(conn net.Conn,
-	header []byte, rbuf []byte, encrypted bool) (requestHeader, []byte, error) {
+// readMessage reads the request header and the payload of a frame from the
+// connection. The returned payload is backed by the specified frame buffer and
+// is only valid until its next use.
+func readMessage(conn net.Conn, header []byte,
+	rbuf *frameBuffer, encrypted bool) (requestHeader, []byte, error) {
 	tt := time.Now().Add(headerDuration)
 	if err := conn.SetReadDeadline(tt); err != nil {
 		return requestHeader{}, nil, err
@@ -192,42 +173,28 @@ func readMessage(conn net.Conn,
 		plog.Errorf("invalid header")
 		return requestHeader{}, nil, ErrBadMessage
 	}
-	if rheader.size == 0 {
+	if rheader.size == 0 || rheader.size > uint64(math.MaxInt) {
 		plog.Errorf("invalid payload length")
 		return requestHeader{}, nil, ErrBadMessage
 	}
-	var buf []byte
-	if rheader.size > uint64(len(rbuf)) {
-		buf = make([]byte, rheader.size)
-	} else {
-		buf = rbuf[:rheader.size]
-	}
-	received := uint64(0)
-	var recvBuf []byte
-	if rheader.size < recvBufSize {
-		recvBuf = buf[:rheader.size]
-	} else {
-		recvBuf = buf[:recvBufSize]
-	}
-	toRead := rheader.size
-	for toRead > 0 {
+	// the buffer is grown as the payload is received, a bogus payload length
+	// can not cause a large allocation before the payload actually arrives
+	size := int(rheader.size)
+	buf := rbuf.get(minInt(size, int(recvBufSize)))
+	received := 0
+	for received < size {
+		if received == len(buf) {
+			buf = rbuf.grow(buf, minInt(2*len(buf), size))
+		}
+		end := minInt(received+int(recvBufSize), len(buf))
 		tt = time.Now().Add(readDuration)
 		if err := conn.SetReadDeadline(tt); err != nil {
 			return requestHeader{}, nil, err
 		}
-		if _, err := io.ReadFull(conn, recvBuf); err != nil {
+		if _, err := io.ReadFull(conn, buf[received:end]); err != nil {
 			return requestHeader{}, nil, err
 		}
-		toRead -= uint64(len(recvBuf))
-		received += uint64(len(recvBuf))
-		if toRead < recvBufSize {
-			recvBuf = buf[received : received+toRead]
-		} else {
-			recvBuf = buf[received : received+recvBufSize]
-		}
-	}
-	if received != rheader.size {
-		panic("unexpected size")
+		received = end
 	}
 	if !encrypted && crc32.ChecksumIEEE(buf) != rheader.crc {
 		plog.Errorf("invalid payload checksum")
@@ -247,6 +214,21 @@ func readMagicNumber(conn net.Conn, magicNum []byte) error {
 	if bytes.Equal(magicNum, poisonNumber[:]) {
 		return errPoisonReceived
 	}
+	if bytes.Equal(magicNum, pingNumber[:]) {
+		return errPingReceived
+	}
+	if bytes.Equal(magicNum, muxHelloNumber[:]) {
+		return errMuxHelloReceived
+	}
+	if bytes.Equal(magicNum, handshakeNumber[:]) {
+		return errHandshakeReceived
+	}
+	if bytes.Equal(magicNum, windowNumber[:]) {
+		return errWindowRequested
+	}
+	if bytes.Equal(magicNum, snapshotAckNumber[:]) {
+		return errSnapshotAckRequested
+	}
 	if !bytes.Equal(magicNum, magicNumber[:]) {
 		return ErrBadMessage
 	}
@@ -294,52 +276,185 @@ func (c *connection) SetWriteDeadline(t time.Time) error {
 }
 
 // TCPConnection is the connection used for sending raft messages to remote
-// nodes.
+// nodes. Frames sent back by the remote node, e.g. pongs and unknown target
+// reports, are read by a dedicated worker goroutine.
 type TCPConnection struct {
-	conn      net.Conn
-	header    []byte
-	payload   []byte
-	encrypted bool
+	conn            net.Conn
+	payload         *frameBuffer
+	onUnknownTarget func(uint64, uint64)
+	pongc           chan struct{}
+	windowc         chan window
+	ackc            chan struct{}
+	readc           chan struct{}
+	stallTimeout    time.Duration
+	encrypted       bool
+	failed          bool
 }
 
 var _ raftio.IConnection = (*TCPConnection)(nil)
 
 // NewTCPConnection creates and returns a new TCPConnection instance.
 func NewTCPConnection(conn net.Conn, encrypted bool) *TCPConnection {
-	return &TCPConnection{
-		conn:      newConnection(conn),
-		header:    make([]byte, requestHeaderSize),
-		payload:   make([]byte, perConnBufSize),
-		encrypted: encrypted,
+	return newTCPConnection(conn, encrypted, 0, nil)
+}
+
+func newTCPConnection(conn net.Conn, encrypted bool,
+	stallTimeout time.Duration,
+	onUnknownTarget func(uint64, uint64)) *TCPConnection {
+	c := &TCPConnection{
+		conn:            newConnection(conn),
+		payload:         newFrameBuffer(int(perConnBufSize)),
+		onUnknownTarget: onUnknownTarget,
+		pongc:           make(chan struct{}, 1),
+		windowc:         make(chan window, 1),
+		ackc:            make(chan struct{}, 1),
+		readc:           make(chan struct{}),
+		stallTimeout:    stallTimeout,
+		encrypted:       encrypted,
 	}
+	go c.readMain()
+	return c
 }
 
-// Close closes the TCPConnection instance.
+// Close closes the TCPConnection instance. A goodbye frame is sent to the
+// remote node first when the connection is still healthy so the remote node
+// can close its end of the connection cleanly.
 func (c *TCPConnection) Close() {
-	if err := c.conn.Close(); err != nil {
-		plog.Errorf("failed to close the connection %v", err)
+	defer func() {
+		if err := c.conn.Close(); err != nil {
+			plog.Errorf("failed to close the connection %v", err)
+		}
+		<-c.readc
+	}()
+	if c.failed {
+		return
+	}
+	if err := sendPoison(c.conn, poisonNumber[:]); err != nil {
+		return
+	}
+	timer := time.NewTimer(keepAlivePeriod)
+	defer timer.Stop()
+	select {
+	case <-c.ackc:
+	case <-c.readc:
+	case <-timer.C:
+		plog.Errorf("failed to get poison ack")
+	}
+}
+
+// readMain reads frames sent back by the remote node until the connection is
+// closed.
+func (c *TCPConnection) readMain() {
+	defer close(c.readc)
+	// deadlines set during the handshake no longer apply
+	if err := c.conn.SetReadDeadline(time.Time{}); err != nil {
+		return
+	}
+	buf := make([]byte, windowFrameSize)
+	for {
+		magicNum := buf[:len(magicNumber)]
+		if _, err := io.ReadFull(c.conn, magicNum); err != nil {
+			return
+		}
+		switch {
+		case bytes.Equal(magicNum, pingNumber[:]):
+			select {
+			case c.pongc <- struct{}{}:
+			default:
+			}
+		case bytes.Equal(magicNum, windowNumber[:]):
+			if _, err := io.ReadFull(c.conn,
+				buf[len(windowNumber):windowFrameSize]); err != nil {
+				return
+			}
+			w := window{}
+			if !w.decode(buf[:windowFrameSize]) {
+				return
+			}
+			select {
+			case c.windowc <- w:
+			default:
+			}
+		case bytes.Equal(magicNum, unknownTargetNumber[:]):
+			if _, err := io.ReadFull(c.conn,
+				buf[len(unknownTargetNumber):unknownTargetFrameSize]); err != nil {
+				return
+			}
+			shardID, replicaID := decodeUnknownTarget(buf[:unknownTargetFrameSize])
+			if c.onUnknownTarget != nil {
+				c.onUnknownTarget(shardID, replicaID)
+			}
+		case bytes.Equal(magicNum, poisonNumber[:]):
+			c.ackc <- struct{}{}
+			return
+		default:
+			return
+		}
+	}
+}
+
+// waitReply waits for the reply from the specified channel until the stall
+// timeout is reached.
+func (c *TCPConnection) waitReply(replyc <-chan struct{}) error {
+	timer := time.NewTimer(c.getStallTimeout())
+	defer timer.Stop()
+	select {
+	case <-replyc:
+		return nil
+	case <-c.readc:
+		return ErrBadMessage
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
 	}
 }
 
 // SendMessageBatch sends a raft message batch to remote node.
 func (c *TCPConnection) SendMessageBatch(batch pb.MessageBatch) error {
-	header := requestHeader{method: raftType}
-	sz := batch.SizeUpperLimit()
-	var buf []byte
-	if len(c.payload) < sz {
-		buf = make([]byte, sz)
-	} else {
-		buf = c.payload
+	frame := c.payload.get(frameHeaderSize + batch.SizeUpperLimit())
+	sz, err := batch.MarshalTo(frame[frameHeaderSize:])
+	if err != nil {
+		panic(err)
+	}
+	frame = encodeFrame(frame[:frameHeaderSize+sz], raftType, c.encrypted)
+	if err := writeFrame(c.conn, frame, c.getStallTimeout()); err != nil {
+		c.failed = true
+		return err
 	}
-	buf = pb.MustMarshalTo(&batch, buf)
-	return writeMessage(c.conn, header, buf, c.header, c.encrypted)
+	return nil
+}
+
+// Ping sends a ping frame to the remote node and waits for its reply.
+func (c *TCPConnection) Ping() error {
+	if err := c.ping(); err != nil {
+		c.failed = true
+		return err
+	}
+	return nil
+}
+
+func (c *TCPConnection) ping() error {
+	timeout := c.getStallTimeout()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if _, err := c.conn.Write(pingNumber[:]); err != nil {
+		return err
+	}
+	return c.waitReply(c.pongc)
+}
+
+func (c *TCPConnection) getStallTimeout() time.Duration {
+	if c.stallTimeout > 0 {
+		return c.stallTimeout
+	}
+	return writeDuration
 }
 
 // TCPSnapshotConnection is the connection for sending raft snapshot chunks to
 // remote nodes.
 type TCPSnapshotConnection struct {
 	conn      net.Conn
-	header    []byte
+	payload   *frameBuffer
 	encrypted bool
 }
 
@@ -350,7 +465,7 @@ func NewTCPSnapshotConnection(conn net.Conn,
 	encrypted bool) *TCPSnapshotConnection {
 	return &TCPSnapshotConnection{
 		conn:      newConnection(conn),
-		header:    make([]byte, requestHeaderSize),
+		payload:   newFrameBuffer(0),
 		encrypted: encrypted,
 	}
 }
@@ -370,22 +485,43 @@ func (c *TCPSnapshotConnection) Close() {
 
 // SendChunk sends the specified snapshot chunk to remote node.
 func (c *TCPSnapshotConnection) SendChunk(chunk pb.Chunk) error {
-	header := requestHeader{method: snapshotType}
-	sz := chunk.Size()
-	buf := make([]byte, sz)
-	buf = pb.MustMarshalTo(&chunk, buf)
-	return writeMessage(c.conn, header, buf, c.header, c.encrypted)
+	frame := c.payload.get(frameHeaderSize + chunk.Size())
+	sz, err := chunk.MarshalTo(frame[frameHeaderSize:])
+	if err != nil {
+		panic(err)
+	}
+	frame = encodeFrame(frame[:frameHeaderSize+sz], snapshotType, c.encrypted)
+	return writeFrame(c.conn, frame, writeDuration)
 }
 
 // TCP is a TCP based transport module for exchanging raft messages and
 // snapshots between NodeHost instances.
 type TCP struct {
-	stopper        *syncutil.Stopper
-	connStopper    *syncutil.Stopper
-	requestHandler raftio.MessageHandler
-	chunkHandler   raftio.ChunkHandler
-	nhConfig       config.NodeHostConfig
-	encrypted      bool
+	stopper              *syncutil.Stopper
+	connStopper          *syncutil.Stopper
+	requestHandler       raftio.MessageHandler
+	chunkHandler         raftio.ChunkHandler
+	nhConfig             config.NodeHostConfig
+	keepAliveInterval    time.Duration
+	keepAliveCount       int
+	stallTimeout         time.Duration
+	socket               config.SocketConfig
+	onRejected           func(string)
+	inboundCapacity      func() window
+	syncChunk            func(pb.Chunk) error
+	onUnknownTarget      func(string, uint64, uint64)
+	hasTarget            func(uint64, uint64) bool
+	authToken            string
+	nodeHostID           string
+	encrypted            bool
+	multiplexing         bool
+	allowUnauthenticated bool
+	mu                   struct {
+		sync.Mutex
+		sessions    map[string]*muxSession
+		dialing     map[string]*sync.Mutex
+		unsupported map[string]time.Time
+	}
 }
 
 var _ raftio.ITransport = (*TCP)(nil)
@@ -394,27 +530,51 @@ var _ raftio.ITransport = (*TCP)(nil)
 func NewTCPTransport(nhConfig config.NodeHostConfig,
 	requestHandler raftio.MessageHandler,
 	chunkHandler raftio.ChunkHandler) raftio.ITransport {
-	return &TCP{
-		nhConfig:       nhConfig,
-		stopper:        syncutil.NewStopper(),
-		connStopper:    syncutil.NewStopper(),
-		requestHandler: requestHandler,
-		chunkHandler:   chunkHandler,
-		encrypted:      nhConfig.MutualTLS,
+	t := &TCP{
+		nhConfig:             nhConfig,
+		stopper:              syncutil.NewStopper(),
+		connStopper:          syncutil.NewStopper(),
+		requestHandler:       requestHandler,
+		chunkHandler:         chunkHandler,
+		keepAliveInterval:    keepAlivePeriod,
+		keepAliveCount:       nhConfig.Expert.TransportKeepAliveCount,
+		stallTimeout:         nhConfig.Expert.MaxSendStallDuration,
+		socket:               nhConfig.Expert.Socket,
+		encrypted:            nhConfig.MutualTLS,
+		multiplexing:         nhConfig.Expert.TransportMultiplexing,
+		authToken:            nhConfig.TransportAuthToken,
+		allowUnauthenticated: nhConfig.AllowUnauthenticatedTransport,
 	}
+	t.mu.sessions = make(map[string]*muxSession)
+	t.mu.dialing = make(map[string]*sync.Mutex)
+	t.mu.unsupported = make(map[string]time.Time)
+	if nhConfig.Expert.TransportKeepAliveInterval > 0 {
+		t.keepAliveInterval = nhConfig.Expert.TransportKeepAliveInterval
+	}
+	return t
 }
 
 // Start starts the TCP transport module.
 func (t *TCP) Start() error {
-	address := t.nhConfig.GetListenAddress()
 	tlsConfig, err := t.nhConfig.GetServerTLSConfig()
 	if err != nil {
 		return err
 	}
-	listener, err := netutil.NewStoppableListener(address,
-		tlsConfig, t.stopper.ShouldStop())
-	if err != nil {
-		return err
+	if !t.socket.IsEmpty() {
+		plog.Infof("transport socket options: %+v", t.socket)
+	}
+	listeners := make([]net.Listener, 0)
+	for _, address := range t.nhConfig.GetListenAddresses() {
+		listener, err := t.listen(address, tlsConfig)
+		if err != nil {
+			for _, l := range listeners {
+				if cerr := l.Close(); cerr != nil {
+					plog.Errorf("failed to close the listener %v", cerr)
+				}
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
 	}
 	t.connStopper.RunWorker(func() {
 		// sync.WaitGroup's doc mentions that
@@ -425,42 +585,124 @@ func (t *TCP) Start() error {
 		// positive delta has never been called.
 		<-t.connStopper.ShouldStop()
 	})
-	t.stopper.RunWorker(func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				if err == netutil.ErrListenerStopped {
-					return
-				}
-				panic(err)
-			}
-			var once sync.Once
-			connCloseCh := make(chan struct{})
-			closeFn := func() {
-				once.Do(func() {
-					select {
-						case connCloseCh <- struct{}{}:
-						default:
-					}
-					if err := conn.Close(); err != nil {
-						plog.Errorf("failed to close the connection %v", err)
-					}
-				})
+	for _, listener := range listeners {
+		l := listener
+		t.stopper.RunWorker(func() {
+			t.serveListener(l)
+		})
+	}
+	return nil
+}
+
+func (t *TCP) listen(address string,
+	tlsConfig *tls.Config) (net.Listener, error) {
+	if config.IsValidIPv6Address(address) || !t.socket.IsEmpty() {
+		ln, err := sockopt.Listen(address, t.socket)
+		if err != nil {
+			return nil, err
+		}
+		return newTCPListener(ln, tlsConfig, t.stopper, t.setTCPConn), nil
+	}
+	return netutil.NewStoppableListener(address,
+		tlsConfig, t.stopper.ShouldStop())
+}
+
+func (t *TCP) serveListener(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if err == netutil.ErrListenerStopped {
+				return
 			}
-			t.connStopper.RunWorker(func() {
+			panic(err)
+		}
+		var once sync.Once
+		connCloseCh := make(chan struct{})
+		closeFn := func() {
+			once.Do(func() {
 				select {
-				case <-t.stopper.ShouldStop():
-				case <-connCloseCh:
+				case connCloseCh <- struct{}{}:
+				default:
+				}
+				if err := conn.Close(); err != nil {
+					plog.Errorf("failed to close the connection %v", err)
 				}
-				closeFn()
-			})
-			t.connStopper.RunWorker(func() {
-				t.serveConn(conn)
-				closeFn()
 			})
 		}
+		t.connStopper.RunWorker(func() {
+			select {
+			case <-t.stopper.ShouldStop():
+			case <-connCloseCh:
+			}
+			closeFn()
+		})
+		t.connStopper.RunWorker(func() {
+			t.serveConn(conn, false)
+			closeFn()
+		})
+	}
+}
+
+// tcpListener is the listener used for listening on IPv6 addresses or when
+// socket options are configured, it returns netutil.ErrListenerStopped from
+// Accept once the transport module is stopped.
+type tcpListener struct {
+	net.Listener
+	tlsConfig *tls.Config
+	setConn   func(*net.TCPConn) error
+	stopc     chan struct{}
+}
+
+func newTCPListener(ln net.Listener, tlsConfig *tls.Config,
+	stopper *syncutil.Stopper,
+	setConn func(*net.TCPConn) error) *tcpListener {
+	l := &tcpListener{
+		Listener:  ln,
+		tlsConfig: tlsConfig,
+		setConn:   setConn,
+		stopc:     stopper.ShouldStop(),
+	}
+	stopper.RunWorker(func() {
+		<-l.stopc
+		if err := ln.Close(); err != nil {
+			plog.Errorf("failed to close the listener %v", err)
+		}
 	})
-	return nil
+	return l
+}
+
+// Accept accepts the next incoming connection.
+func (l *tcpListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case <-l.stopc:
+				return nil, netutil.ErrListenerStopped
+			default:
+			}
+			return nil, err
+		}
+		if tcpconn, ok := conn.(*net.TCPConn); ok {
+			if err := l.setConn(tcpconn); err != nil {
+				conn.Close()
+				continue
+			}
+		}
+		if l.tlsConfig != nil {
+			tc := tls.Server(conn, l.tlsConfig)
+			if err := tc.SetDeadline(time.Now().Add(tlsHandshackTimeout)); err != nil {
+				conn.Close()
+				continue
+			}
+			if err := tc.Handshake(); err != nil {
+				conn.Close()
+				continue
+			}
+			return tc, nil
+		}
+		return conn, nil
+	}
 }
 
 // Close closes the TCP transport module.
@@ -473,18 +715,23 @@ func (t *TCP) Close() error {
 // GetConnection returns a new raftio.IConnection for sending raft messages.
 func (t *TCP) GetConnection(ctx context.Context,
 	target string) (raftio.IConnection, error) {
-	conn, err := t.getConnection(ctx, target)
+	conn, err := t.getStreamOrConnection(ctx, target, muxMessageLane)
 	if err != nil {
 		return nil, err
 	}
-	return NewTCPConnection(conn, t.encrypted), nil
+	return newTCPConnection(conn, t.encrypted, t.stallTimeout,
+		func(shardID uint64, replicaID uint64) {
+			if t.onUnknownTarget != nil {
+				t.onUnknownTarget(target, shardID, replicaID)
+			}
+		}), nil
 }
 
 // GetSnapshotConnection returns a new raftio.IConnection for sending raft
 // snapshots.
 func (t *TCP) GetSnapshotConnection(ctx context.Context,
 	target string) (raftio.ISnapshotConnection, error) {
-	conn, err := t.getConnection(ctx, target)
+	conn, err := t.getStreamOrConnection(ctx, target, muxSnapshotLane)
 	if err != nil {
 		return nil, err
 	}
@@ -496,12 +743,31 @@ func (t *TCP) Name() string {
 	return TCPTransportName
 }
 
-func (t *TCP) serveConn(conn net.Conn) {
+func (t *TCP) serveConn(conn net.Conn, authenticated bool) {
 	magicNum := make([]byte, len(magicNumber))
 	header := make([]byte, requestHeaderSize)
-	tbuf := make([]byte, payloadBufferSize)
+	tbuf := newFrameBuffer(int(payloadBufferSize))
+	ut := &unknownTargets{}
+	var lastChunk *pb.Chunk
+	consumed := uint64(0)
 	for {
 		err := readMagicNumber(conn, magicNum)
+		if errors.Is(err, errHandshakeReceived) {
+			if authenticated || !t.authenticate(conn) {
+				return
+			}
+			authenticated = true
+			continue
+		}
+		if !authenticated && t.authRequired() && (err == nil ||
+			errors.Is(err, errPingReceived) || errors.Is(err, errMuxHelloReceived) ||
+			errors.Is(err, errWindowRequested) ||
+			errors.Is(err, errSnapshotAckRequested)) {
+			plog.Warningf("unauthenticated connection from %s rejected",
+				conn.RemoteAddr())
+			t.rejected(conn)
+			return
+		}
 		if err != nil {
 			if errors.Is(err, errPoisonReceived) {
 				if err := sendPoisonAck(conn, poisonNumber[:]); err != nil {
@@ -509,6 +775,31 @@ func (t *TCP) serveConn(conn net.Conn) {
 				}
 				return
 			}
+			if errors.Is(err, errPingReceived) {
+				if err := sendPong(conn); err != nil {
+					plog.Debugf("failed to send pong %v", err)
+					return
+				}
+				continue
+			}
+			if errors.Is(err, errWindowRequested) {
+				if err := t.sendWindow(conn); err != nil {
+					plog.Debugf("failed to send window %v", err)
+					return
+				}
+				continue
+			}
+			if errors.Is(err, errSnapshotAckRequested) {
+				if err := t.sendSnapshotAck(conn, lastChunk, consumed); err != nil {
+					plog.Errorf("failed to send snapshot ack %v", err)
+					return
+				}
+				continue
+			}
+			if errors.Is(err, errMuxHelloReceived) {
+				t.serveSession(conn)
+				return
+			}
 			if errors.Is(err, ErrBadMessage) {
 				return
 			}
@@ -525,10 +816,15 @@ func (t *TCP) serveConn(conn net.Conn) {
 		}
 		if rheader.method == raftType {
 			batch := pb.MessageBatch{}
-			if err := batch.Unmarshal(buf); err != nil {
+			if err := batch.UnmarshalShared(buf); err != nil {
 				return
 			}
+			retainPayloads(&batch)
 			t.requestHandler(batch)
+			if err := t.reportUnknownTargets(conn, batch, ut); err != nil {
+				plog.Debugf("failed to report unknown targets %v", err)
+				return
+			}
 		} else {
 			chunk := pb.Chunk{}
 			if err := chunk.Unmarshal(buf); err != nil {
@@ -538,18 +834,178 @@ func (t *TCP) serveConn(conn net.Conn) {
 				plog.Errorf("chunk rejected %s", chunkKey(chunk))
 				return
 			}
+			consumed += uint64(len(chunk.Data))
+			chunk.Data = nil
+			lastChunk = &chunk
+		}
+	}
+}
+
+// serveSession serves the multiplexed session requested by the remote side.
+// The request is rejected when multiplexing is not enabled so the remote side
+// can fall back to use separate connections.
+func (t *TCP) serveSession(conn net.Conn) {
+	if _, ok := conn.(*muxStream); ok || !t.multiplexing {
+		if err := sendPoison(conn, muxRejectNumber[:]); err != nil {
+			plog.Debugf("failed to reject the mux session %v", err)
+		}
+		return
+	}
+	if err := sendPoison(conn, muxHelloNumber[:]); err != nil {
+		plog.Debugf("failed to accept the mux session %v", err)
+		return
+	}
+	s := newMuxSession(conn, false, t.getWriteTimeout(), func(st *muxStream) {
+		t.connStopper.RunWorker(func() {
+			// the session is only established on authenticated connections
+			t.serveConn(st, true)
+			if err := st.Close(); err != nil {
+				plog.Errorf("failed to close the stream %v", err)
+			}
+		})
+	})
+	s.start(t.connStopper, t.stopper.ShouldStop())
+	<-s.stopc
+}
+
+// getStreamOrConnection returns a stream of the multiplexed session to the
+// target when multiplexing is enabled and supported by the target, a new
+// connection is returned otherwise.
+func (t *TCP) getStreamOrConnection(ctx context.Context,
+	target string, lane uint8) (net.Conn, error) {
+	if t.multiplexing && t.muxSupported(target) {
+		st, err := t.getStream(ctx, target, lane)
+		if err == nil {
+			return st, nil
+		}
+		if !errors.Is(err, errMuxNotSupported) {
+			return nil, err
+		}
+		plog.Infof("multiplexing not supported by %s", target)
+	}
+	return t.getConnection(ctx, target)
+}
+
+func (t *TCP) muxSupported(target string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tt, ok := t.mu.unsupported[target]; ok {
+		if time.Since(tt) < muxRetryInterval {
+			return false
+		}
+		delete(t.mu.unsupported, target)
+	}
+	return true
+}
+
+func (t *TCP) getStream(ctx context.Context,
+	target string, lane uint8) (*muxStream, error) {
+	for {
+		s, err := t.getSession(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		st, err := s.open(lane)
+		if err == nil {
+			return st, nil
+		}
+		// the session can be closed concurrently when it became idle, retry
+		// with a new session in such case
+		if !errors.Is(err, errSessionClosed) || s.error() != errSessionClosed {
+			return nil, err
+		}
+	}
+}
+
+func (t *TCP) getSession(ctx context.Context,
+	target string) (*muxSession, error) {
+	// only one session is dialed at a time for each target
+	t.mu.Lock()
+	dialing, ok := t.mu.dialing[target]
+	if !ok {
+		dialing = &sync.Mutex{}
+		t.mu.dialing[target] = dialing
+	}
+	t.mu.Unlock()
+	dialing.Lock()
+	defer dialing.Unlock()
+	t.mu.Lock()
+	s, ok := t.mu.sessions[target]
+	t.mu.Unlock()
+	if ok && !s.closed() {
+		return s, nil
+	}
+	conn, err := t.getConnection(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.requestSession(conn); err != nil {
+		if cerr := conn.Close(); cerr != nil {
+			plog.Debugf("failed to close the connection %v", cerr)
+		}
+		if errors.Is(err, errMuxNotSupported) {
+			t.mu.Lock()
+			t.mu.unsupported[target] = time.Now()
+			t.mu.Unlock()
 		}
+		return nil, err
 	}
+	s = newMuxSession(conn, true, t.getWriteTimeout(), nil)
+	t.mu.Lock()
+	t.mu.sessions[target] = s
+	t.mu.Unlock()
+	s.start(t.connStopper, t.stopper.ShouldStop())
+	return s, nil
 }
 
-func setTCPConn(conn *net.TCPConn) error {
+// requestSession asks the remote side to establish a multiplexed session.
+// errMuxNotSupported is returned when the request is rejected or not
+// understood by the remote side.
+func (t *TCP) requestSession(conn net.Conn) error {
+	if err := sendPoison(conn, muxHelloNumber[:]); err != nil {
+		return err
+	}
+	tt := time.Now().Add(magicNumberDuration).Add(headerDuration)
+	if err := conn.SetReadDeadline(tt); err != nil {
+		return err
+	}
+	reply := make([]byte, len(muxHelloNumber))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		// remote NodeHost instances without multiplexing support just drop the
+		// connection
+		plog.Debugf("failed to get the mux session reply %v", err)
+		return errMuxNotSupported
+	}
+	if !bytes.Equal(reply, muxHelloNumber[:]) {
+		return errMuxNotSupported
+	}
+	return nil
+}
+
+func (t *TCP) getWriteTimeout() time.Duration {
+	if t.stallTimeout > 0 {
+		return t.stallTimeout
+	}
+	return writeDuration
+}
+
+func (t *TCP) setTCPConn(conn *net.TCPConn) error {
 	if err := conn.SetLinger(0); err != nil {
 		return err
 	}
+	if err := sockopt.SetConn(conn, t.socket); err != nil {
+		return err
+	}
 	if err := conn.SetKeepAlive(true); err != nil {
 		return err
 	}
-	return conn.SetKeepAlivePeriod(keepAlivePeriod)
+	if err := conn.SetKeepAlivePeriod(t.keepAliveInterval); err != nil {
+		return err
+	}
+	if t.keepAliveCount > 0 {
+		return setKeepAliveCount(conn, t.keepAliveCount)
+	}
+	return nil
 }
 
 // FIXME:
@@ -563,7 +1019,7 @@ func (t *TCP) getConnection(ctx context.Context,
 	}
 	tcpconn, ok := conn.(*net.TCPConn)
 	if ok {
-		if err := setTCPConn(tcpconn); err != nil {
+		if err := t.setTCPConn(tcpconn); err != nil {
 			return nil, err
 		}
 	}
@@ -581,5 +1037,13 @@ func (t *TCP) getConnection(ctx context.Context,
 			return nil, err
 		}
 	}
+	if len(t.authToken) > 0 {
+		if err := t.sendHandshake(conn); err != nil {
+			if cerr := conn.Close(); cerr != nil {
+				plog.Debugf("failed to close the connection %v", cerr)
+			}
+			return nil, err
+		}
+	}
 	return conn, nil
 }
@@ -73,10 +73,11 @@ var (
 )
 
 var (
-	plog                = logger.GetLogger("transport")
+	plog                = logger.GetStructuredLogger("transport")
 	sendQueueLen        = settings.Soft.SendQueueLength
 	dialTimeoutSecond   = settings.Soft.GetConnectedTimeoutSecond
 	idleTimeout         = time.Minute
+	idleCheckInterval   = idleTimeout / 4
 	errChunkSendSkipped = errors.New("chunk skipped")
 	errBatchSendSkipped = errors.New("batch skipped")
 	dn                  = logutil.DescribeNode
@@ -97,6 +98,9 @@ type ITransport interface {
 	Send(pb.Message) bool
 	SendSnapshot(pb.Message) bool
 	GetStreamSink(shardID uint64, replicaID uint64) *Sink
+	GetPeerStats() []PeerStats
+	GetSnapshotStagingBytes() uint64
+	RemoveConnections(addr string)
 	Close() error
 }
 
@@ -112,9 +116,43 @@ type StreamChunkSendFunc func(pb.Chunk) (pb.Chunk, bool)
 // specified message batch should be sent. This func is used in test only.
 type SendMessageBatchFunc func(pb.MessageBatch) (pb.MessageBatch, bool)
 
+// sendQueue is the per target send queue. Small control messages are queued
+// in the ctrl lane so they are never stuck behind bulk entry batches queued in
+// the ch lane. Messages in each lane are processed in their queued order.
 type sendQueue struct {
-	ch chan pb.Message
-	rl *server.RateLimiter
+	ctrl   chan pb.Message
+	ch     chan pb.Message
+	closed chan struct{}
+	rl     *server.RateLimiter
+	stats  *peerStats
+}
+
+func newSendQueue(length uint64,
+	maxSize uint64, stats *peerStats) sendQueue {
+	return sendQueue{
+		ctrl:   make(chan pb.Message, length),
+		ch:     make(chan pb.Message, length),
+		closed: make(chan struct{}),
+		rl:     server.NewRateLimiter(maxSize),
+		stats:  stats,
+	}
+}
+
+func (sq *sendQueue) length() uint64 {
+	return uint64(len(sq.ctrl) + len(sq.ch))
+}
+
+// isControlMessage returns a boolean value indicating whether the specified
+// message is a small control message that should jump ahead of bulk entries.
+func isControlMessage(msg pb.Message) bool {
+	switch msg.Type {
+	case pb.Heartbeat, pb.HeartbeatResp,
+		pb.RequestVote, pb.RequestVoteResp,
+		pb.RequestPreVote, pb.RequestPreVoteResp,
+		pb.ReadIndex, pb.ReadIndexResp:
+		return true
+	}
+	return false
 }
 
 func (sq *sendQueue) rateLimited() bool {
@@ -135,10 +173,21 @@ func (sq *sendQueue) decrease(msg pb.Message) {
 	sq.rl.Decrease(pb.GetEntrySliceInMemSize(msg.Entries))
 }
 
-// ITransportEvent is the interface for notifying connection status changes.
+// pinger is the interface implemented by connections that support the
+// application level ping frame.
+type pinger interface {
+	// Ping sends a ping frame to the remote node and waits for its reply.
+	Ping() error
+}
+
+// ITransportEvent is the interface for notifying connection status changes
+// and the status of snapshots being received.
 type ITransportEvent interface {
+	ISnapshotReceiveEvent
 	ConnectionEstablished(string, bool)
 	ConnectionFailed(string, bool)
+	ConnectionRejected(string)
+	MisdeliveredMessage(string, uint64, uint64)
 }
 
 type failedSend uint64
@@ -151,6 +200,8 @@ const (
 	unknownTarget
 	rateLimited
 	chanIsFull
+	transportStopped
+	nodeHostSuspect
 )
 
 // DefaultTransportFactory is the default transport module used.
@@ -173,8 +224,9 @@ func (dtm *DefaultTransportFactory) Validate(addr string) bool {
 type Transport struct {
 	mu struct {
 		sync.Mutex
-		queues   map[string]sendQueue
-		breakers map[string]*circuit.Breaker
+		queues     map[string]sendQueue
+		breakers   map[string]*circuit.Breaker
+		sideloaded map[raftio.NodeInfo]uint64
 	}
 	sysEvents    ITransportEvent
 	ctx          context.Context
@@ -189,11 +241,21 @@ type Transport struct {
 	dir          server.SnapshotDirFunc
 	env          *server.Env
 	metrics      *transportMetrics
+	stats        peerStatsRegistry
 	chunks       *Chunk
 	cancel       context.CancelFunc
 	sourceID     string
 	nhConfig     config.NodeHostConfig
 	jobs         uint64
+	stagedBytes  uint64
+	queueLength  uint64
+	queueBytes   uint64
+	policy       config.SendQueueOverflowPolicy
+	blockTimeout time.Duration
+	drainTimeout time.Duration
+	pingInterval time.Duration
+	closed       uint32
+	flowControl  bool
 }
 
 var _ ITransport = (*Transport)(nil)
@@ -207,24 +269,53 @@ func NewTransport(nhConfig config.NodeHostConfig,
 	if nhConfig.NodeRegistryEnabled() {
 		sourceID = env.NodeHostID()
 	}
+	ec := nhConfig.Expert.Engine
 	t := &Transport{
-		nhConfig:   nhConfig,
-		env:        env,
-		sourceID:   sourceID,
-		resolver:   resolver,
-		stopper:    syncutil.NewStopper(),
-		dir:        dir,
-		sysEvents:  sysEvents,
-		fs:         fs,
-		msgHandler: handler,
+		nhConfig:     nhConfig,
+		env:          env,
+		sourceID:     sourceID,
+		resolver:     resolver,
+		stopper:      syncutil.NewStopper(),
+		dir:          dir,
+		sysEvents:    sysEvents,
+		fs:           fs,
+		msgHandler:   handler,
+		queueLength:  sendQueueLen,
+		queueBytes:   nhConfig.MaxSendQueueSize,
+		policy:       ec.SendQueueOverflowPolicy,
+		blockTimeout: time.Duration(ec.SendQueueBlockTimeoutMS) * time.Millisecond,
+		drainTimeout: nhConfig.Expert.TransportDrainTimeout,
+		pingInterval: nhConfig.Expert.TransportPingInterval,
+		flowControl:  nhConfig.Expert.TransportFlowControl,
+	}
+	if ec.SendQueueLength > 0 {
+		t.queueLength = ec.SendQueueLength
+	}
+	if ec.SendQueueBytes > 0 {
+		t.queueBytes = ec.SendQueueBytes
 	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
 	chunks := NewChunk(t.handleRequest,
 		t.snapshotReceived, t.dir, t.nhConfig.GetDeploymentID(), fs)
+	chunks.ctx = t.ctx
+	chunks.sideloader = nhConfig.SnapshotSideloader
+	chunks.events = sysEvents
+	chunks.staging = env.GetStagingSpace()
 	t.trans = create(nhConfig, t.handleRequest, chunks.Add)
+	if tcp, ok := t.trans.(*TCP); ok {
+		tcp.onRejected = sysEvents.ConnectionRejected
+		tcp.nodeHostID = env.NodeHostID()
+		tcp.inboundCapacity = t.getInboundCapacity
+		tcp.syncChunk = chunks.Sync
+		tcp.onUnknownTarget = t.misdelivered
+		if nhConfig.Expert.TransportMisdeliveryReport {
+			tcp.hasTarget = t.hasTarget
+		}
+	}
 	t.chunks = chunks
-	t.ctx, t.cancel = context.WithCancel(context.Background())
 	t.mu.queues = make(map[string]sendQueue)
 	t.mu.breakers = make(map[string]*circuit.Breaker)
+	t.mu.sideloaded = make(map[raftio.NodeInfo]uint64)
 	msgConn := func() float64 {
 		t.mu.Lock()
 		defer t.mu.Unlock()
@@ -234,6 +325,7 @@ func NewTransport(nhConfig config.NodeHostConfig,
 		return float64(atomic.LoadUint64(&t.jobs))
 	}
 	t.metrics = newTransportMetrics(true, msgConn, ssCount)
+	t.stats.useMetrics = nhConfig.EnableMetrics
 
 	plog.Infof("transport type: %s", t.trans.Name())
 	if err := t.trans.Start(); err != nil {
@@ -243,12 +335,22 @@ func NewTransport(nhConfig config.NodeHostConfig,
 		}
 		return nil, err
 	}
+	// the logical clock of chunks is driven by the timer wheel of the
+	// NodeHost, chunks.Tick might access the disk so it is not invoked by the
+	// wheel directly
+	tickC := make(chan struct{}, 1)
+	wheel := env.GetTimerWheel()
+	timer := wheel.Every(wheel.Ticks(time.Second), func() {
+		select {
+		case tickC <- struct{}{}:
+		default:
+		}
+	})
 	t.stopper.RunWorker(func() {
-		ticker := time.NewTicker(time.Second)
-		defer ticker.Stop()
+		defer timer.Stop()
 		for {
 			select {
-			case <-ticker.C:
+			case <-tickC:
 				chunks.Tick()
 			case <-t.stopper.ShouldStop():
 				return
@@ -280,14 +382,21 @@ func (t *Transport) SetPreStreamChunkSendHook(h StreamChunkSendFunc) {
 	t.preSend.Store(h)
 }
 
-// Close closes the Transport object.
+// Close closes the Transport object. New messages are rejected once Close is
+// called, messages already queued are sent to their targets for up to
+// Expert.TransportDrainTimeout before the transport module is closed.
 func (t *Transport) Close() error {
+	atomic.StoreUint32(&t.closed, 1)
 	t.cancel()
 	t.stopper.Stop()
 	t.chunks.Close()
 	return t.trans.Close()
 }
 
+func (t *Transport) stopping() bool {
+	return atomic.LoadUint32(&t.closed) == 1
+}
+
 // GetCircuitBreaker returns the circuit breaker used for the specified
 // target node.
 func (t *Transport) GetCircuitBreaker(key string) *circuit.Breaker {
@@ -322,6 +431,9 @@ func (t *Transport) handleRequest(req pb.MessageBatch) {
 			}
 		}
 	}
+	if len(addr) > 0 {
+		t.stats.get(addr).received(uint64(len(req.Requests)), uint64(req.Size()))
+	}
 	ssCount, msgCount := t.msgHandler.HandleMessageBatch(req)
 	dropedMsgCount := uint64(len(req.Requests)) - ssCount - msgCount
 	t.metrics.receivedMessages(ssCount, msgCount, dropedMsgCount)
@@ -332,6 +444,37 @@ func (t *Transport) snapshotReceived(shardID uint64,
 	t.msgHandler.HandleSnapshot(shardID, replicaID, from)
 }
 
+// getInboundCapacity returns the remaining inbound capacity advertised to
+// remote NodeHosts. One message slot is kept in reserve for the bulk message
+// always allowed after each window request.
+func (t *Transport) getInboundCapacity() window {
+	if c, ok := t.msgHandler.(IInboundCapacity); ok {
+		messages, bytes := c.InboundCapacity()
+		return window{messages: subtract(messages, 1), bytes: bytes}
+	}
+	return unlimitedWindow
+}
+
+// misdelivered is invoked when the remote NodeHost at addr reports that the
+// specified target replica is unknown to it.
+func (t *Transport) misdelivered(addr string,
+	shardID uint64, replicaID uint64) {
+	plog.Warningf("%s reported that %s is unknown to it",
+		addr, dn(shardID, replicaID))
+	t.stats.get(addr).misdelivered()
+	t.sysEvents.MisdeliveredMessage(addr, shardID, replicaID)
+}
+
+// hasTarget returns a boolean value indicating whether the specified target
+// replica is known to the local NodeHost. All targets are considered as known
+// when the message handler can't tell.
+func (t *Transport) hasTarget(shardID uint64, replicaID uint64) bool {
+	if r, ok := t.msgHandler.(IReplicaLookup); ok {
+		return r.HasReplica(shardID, replicaID)
+	}
+	return true
+}
+
 func (t *Transport) notifyUnreachable(addr string, affected nodeMap) {
 	plog.Warningf("%s became unreachable, affected %d nodes", addr, len(affected))
 	for n := range affected {
@@ -351,37 +494,59 @@ func (t *Transport) Send(req pb.Message) bool {
 	return v
 }
 
+// GetPeerStats returns the transport statistics of all known remote
+// NodeHosts.
+func (t *Transport) GetPeerStats() []PeerStats {
+	queued := make(map[string]uint64)
+	t.mu.Lock()
+	for _, sq := range t.mu.queues {
+		queued[sq.stats.address] += sq.length()
+	}
+	t.mu.Unlock()
+	return t.stats.getAll(queued)
+}
+
 func (t *Transport) send(req pb.Message) (bool, failedSend) {
-	if req.Type == pb.InstallSnapshot {
+	// witness snapshots only contain metadata, they are sent as regular messages
+	if req.Type == pb.InstallSnapshot && !req.Snapshot.Witness {
 		panic("snapshot message must be sent via its own channel.")
 	}
+	if t.stopping() {
+		return false, transportStopped
+	}
 	toReplicaID := req.To
 	shardID := req.ShardID
 	from := req.From
 	addr, key, err := t.resolver.Resolve(shardID, toReplicaID)
 	if err != nil {
+		// don't dial NodeHosts suspected as failed by the registry
+		if errors.Is(err, registry.ErrNodeHostSuspect) {
+			return false, nodeHostSuspect
+		}
 		return false, unknownTarget
 	}
 	// fail fast
 	if !t.GetCircuitBreaker(addr).Ready() {
 		t.metrics.messageConnectionFailure()
+		t.stats.get(addr).dropped(1)
 		return false, circuitBreakerNotReady
 	}
 	// get the channel, create it in case it is not in the queue map
 	t.mu.Lock()
 	sq, ok := t.mu.queues[key]
 	if !ok {
-		sq = sendQueue{
-			ch: make(chan pb.Message, sendQueueLen),
-			rl: server.NewRateLimiter(t.nhConfig.MaxSendQueueSize),
-		}
+		sq = newSendQueue(t.queueLength, t.queueBytes, t.stats.get(addr))
 		t.mu.queues[key] = sq
 	}
 	t.mu.Unlock()
 	if !ok {
 		shutdownQueue := func() {
 			t.mu.Lock()
-			delete(t.mu.queues, key)
+			// the queue might have been removed by RemoveConnections and
+			// replaced by a new one
+			if cur, ok := t.mu.queues[key]; ok && cur.closed == sq.closed {
+				delete(t.mu.queues, key)
+			}
 			t.mu.Unlock()
 		}
 		t.stopper.RunWorker(func() {
@@ -392,19 +557,79 @@ func (t *Transport) send(req pb.Message) (bool, failedSend) {
 			shutdownQueue()
 		})
 	}
+	if isControlMessage(req) {
+		if !t.enqueue(sq, sq.ctrl, req) {
+			sq.stats.dropped(1)
+			return false, chanIsFull
+		}
+		return true, success
+	}
 	if sq.rateLimited() {
+		sq.stats.dropped(1)
 		return false, rateLimited
 	}
 
 	sq.increase(req)
 
-	select {
-	case sq.ch <- req:
-		return true, success
-	default:
+	if !t.enqueue(sq, sq.ch, req) {
 		sq.decrease(req)
+		sq.stats.dropped(1)
 		return false, chanIsFull
 	}
+	return true, success
+}
+
+// RemoveConnections closes all message connections to the specified address,
+// messages still queued for the address are dropped. It is used when a remote
+// replica moved away from the address, new messages are sent to its new
+// address via new connections.
+func (t *Transport) RemoveConnections(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, sq := range t.mu.queues {
+		if sq.stats.address == addr {
+			delete(t.mu.queues, key)
+			close(sq.closed)
+		}
+	}
+}
+
+// enqueue adds the message to the specified lane of the send queue, the
+// configured overflow policy is applied when the lane is full.
+func (t *Transport) enqueue(sq sendQueue,
+	lane chan pb.Message, req pb.Message) bool {
+	select {
+	case lane <- req:
+		return true
+	default:
+	}
+	switch t.policy {
+	case config.DropOldestNonCritical:
+		if lane == sq.ctrl {
+			return false
+		}
+		select {
+		case old := <-lane:
+			sq.decrease(old)
+			sq.stats.dropped(1)
+		default:
+		}
+		select {
+		case lane <- req:
+			return true
+		default:
+		}
+	case config.BlockWithDeadline:
+		timer := time.NewTimer(t.blockTimeout)
+		defer timer.Stop()
+		select {
+		case lane <- req:
+			return true
+		case <-timer.C:
+		case <-t.stopper.ShouldStop():
+		}
+	}
+	return false
 }
 
 // connectAndProcess returns a boolean value indicating whether it is stopped
@@ -418,21 +643,26 @@ func (t *Transport) connectAndProcess(remoteHost string,
 		plog.Debugf("%s is trying to connect to %s", t.sourceID, remoteHost)
 		conn, err := t.trans.GetConnection(t.ctx, remoteHost)
 		if err != nil {
-			plog.Errorf("Nodehost %s failed to get a connection to %s, %v",
-				t.sourceID, remoteHost, err)
+			plog.Errorw("failed to get a connection",
+				logger.String("source", t.sourceID),
+				logger.String("target", remoteHost), logger.Error(err))
 			return err
 		}
 		defer conn.Close()
 		breaker.Success()
+		sq.stats.connectionEstablished()
 		if successes == 0 || consecFailures > 0 {
 			plog.Debugf("message streaming to %s established", remoteHost)
 			t.sysEvents.ConnectionEstablished(remoteHost, false)
 		}
 		return t.processMessages(remoteHost, sq, conn, affected)
 	}(); err != nil {
-		plog.Warningf("breaker %s to %s failed, connect and process failed: %s",
-			t.sourceID, remoteHost, err.Error())
+		plog.Warningw("breaker failed, connect and process failed",
+			logger.String("source", t.sourceID),
+			logger.String("target", remoteHost), logger.Error(err))
 		breaker.Fail()
+		sq.stats.connectionFailed()
+		sq.stats.setError(err)
 		t.metrics.messageConnectionFailure()
 		t.sysEvents.ConnectionFailed(remoteHost, false)
 		return false
@@ -442,8 +672,33 @@ func (t *Transport) connectAndProcess(remoteHost string,
 
 func (t *Transport) processMessages(remoteHost string,
 	sq sendQueue, conn raftio.IConnection, affected nodeMap) error {
-	idleTimer := time.NewTimer(idleTimeout)
-	defer idleTimer.Stop()
+	// idle and ping checks are driven by the timer wheel of the NodeHost
+	// instead of per connection runtime timers
+	p, pinging := conn.(pinger)
+	pinging = pinging && t.pingInterval > 0
+	interval := idleCheckInterval
+	if pinging && t.pingInterval < interval {
+		interval = t.pingInterval
+	}
+	checkc := make(chan struct{}, 1)
+	wheel := t.env.GetTimerWheel()
+	check := wheel.Every(wheel.Ticks(interval), func() {
+		select {
+		case checkc <- struct{}{}:
+		default:
+		}
+	})
+	defer check.Stop()
+	var fc *flowControl
+	if w, ok := conn.(windowed); ok && t.flowControl {
+		fc = newFlowControl(w, sq.stats)
+		defer fc.close()
+		if err := fc.refresh(); err != nil {
+			plog.Warningf("failed to get the window of %s, %v", remoteHost, err)
+			return err
+		}
+	}
+	lastSend := time.Now()
 	sz := uint64(0)
 	batch := pb.MessageBatch{
 		SourceAddress: t.sourceID,
@@ -452,59 +707,153 @@ func (t *Transport) processMessages(remoteHost string,
 	did := t.nhConfig.GetDeploymentID()
 	requests := make([]pb.Message, 0)
 	for {
-		idleTimer.Reset(idleTimeout)
+		// bulk messages are not received from the queue when paused by the
+		// flow control, the window is requested again after the poll delay
+		bulk := sq.ch
+		var pollc <-chan time.Time
+		if !fc.allowed() {
+			bulk = nil
+			pollc = time.After(fc.pollDelay())
+		}
 		select {
 		case <-t.stopper.ShouldStop():
+			return t.drain(remoteHost, sq, conn, affected)
+		case <-sq.closed:
+			plog.Infof("connection to %s removed", remoteHost)
 			return nil
-		case <-idleTimer.C:
-			return nil
-		case req := <-sq.ch:
-			n := raftio.NodeInfo{
-				ShardID:   req.ShardID,
-				ReplicaID: req.From,
+		case <-checkc:
+			idle := time.Since(lastSend)
+			if idle >= idleTimeout {
+				return nil
 			}
-			affected[n] = struct{}{}
-			sq.decrease(req)
-			sz += uint64(req.SizeUpperLimit())
-			requests = append(requests, req)
-			for done := false; !done && sz < maxMsgBatchSize; {
-				select {
-				case req = <-sq.ch:
-					sq.decrease(req)
-					sz += uint64(req.SizeUpperLimit())
-					requests = append(requests, req)
-				case <-t.stopper.ShouldStop():
-					return nil
-				default:
-					done = true
+			if pinging && idle >= t.pingInterval {
+				if err := p.Ping(); err != nil {
+					plog.Warningf("ping %s failed, %v", remoteHost, err)
+					return err
 				}
 			}
-			batch.DeploymentId = did
-			twoBatch := false
-			if sz < maxMsgBatchSize || len(requests) == 1 {
-				batch.Requests = requests
-			} else {
-				twoBatch = true
-				batch.Requests = requests[:len(requests)-1]
-			}
-			if err := t.sendMessageBatch(conn, batch); err != nil {
-				plog.Errorf("send batch failed, target %s (%v), %d",
-					remoteHost, err, len(batch.Requests))
+			continue
+		case <-pollc:
+			if err := fc.refresh(); err != nil {
+				plog.Warningf("failed to get the window of %s, %v", remoteHost, err)
 				return err
 			}
-			if twoBatch {
-				batch.Requests = []pb.Message{requests[len(requests)-1]}
-				if err := t.sendMessageBatch(conn, batch); err != nil {
-					plog.Errorf("send batch failed, taret node %s (%v), %d",
-						remoteHost, err, len(batch.Requests))
-					return err
-				}
+			continue
+		case req := <-sq.ctrl:
+			requests, sz = sq.add(requests, sz, req, affected)
+		case req := <-bulk:
+			requests, sz = sq.add(requests, sz, req, affected)
+			fc.consume(req)
+		}
+		requests, sz = sq.fill(requests, sz, affected, fc)
+		batch.DeploymentId = did
+		if err := t.sendRequests(remoteHost,
+			conn, batch, requests, sz, sq.stats); err != nil {
+			return err
+		}
+		lastSend = time.Now()
+		sz = 0
+		requests, batch = lazyFree(requests, batch)
+		requests = requests[:0]
+	}
+}
+
+// drain sends messages already queued when the transport is being stopped,
+// it gives up once Expert.TransportDrainTimeout is reached.
+func (t *Transport) drain(remoteHost string,
+	sq sendQueue, conn raftio.IConnection, affected nodeMap) error {
+	if t.drainTimeout == 0 {
+		return nil
+	}
+	batch := pb.MessageBatch{
+		SourceAddress: t.sourceID,
+		BinVer:        raftio.TransportBinVersion,
+		DeploymentId:  t.nhConfig.GetDeploymentID(),
+	}
+	deadline := time.Now().Add(t.drainTimeout)
+	requests := make([]pb.Message, 0)
+	for time.Now().Before(deadline) {
+		var sz uint64
+		requests, sz = sq.fill(requests[:0], 0, affected, nil)
+		if len(requests) == 0 {
+			return nil
+		}
+		if err := t.sendRequests(remoteHost,
+			conn, batch, requests, sz, sq.stats); err != nil {
+			return err
+		}
+	}
+	if n := sq.length(); n > 0 {
+		plog.Warningf("drain timeout, %d messages to %s dropped", n, remoteHost)
+	}
+	return nil
+}
+
+// sendRequests sends the requests to the remote host, the last request is
+// sent in its own batch when the requests exceeded maxMsgBatchSize.
+func (t *Transport) sendRequests(remoteHost string, conn raftio.IConnection,
+	batch pb.MessageBatch, requests []pb.Message, sz uint64,
+	stats *peerStats) error {
+	twoBatch := false
+	if sz < maxMsgBatchSize || len(requests) == 1 {
+		batch.Requests = requests
+	} else {
+		twoBatch = true
+		batch.Requests = requests[:len(requests)-1]
+	}
+	if err := t.sendMessageBatch(conn, batch, stats); err != nil {
+		plog.Errorw("send batch failed", logger.String("target", remoteHost),
+			logger.Error(err), logger.Any("count", len(batch.Requests)))
+		return err
+	}
+	if twoBatch {
+		batch.Requests = []pb.Message{requests[len(requests)-1]}
+		if err := t.sendMessageBatch(conn, batch, stats); err != nil {
+			plog.Errorw("send batch failed", logger.String("target", remoteHost),
+				logger.Error(err), logger.Any("count", len(batch.Requests)))
+			return err
+		}
+	}
+	return nil
+}
+
+// fill adds queued messages to requests until the queue is empty or
+// maxMsgBatchSize is reached. Pending control messages are always added
+// before bulk messages, bulk messages are only added when allowed by the
+// specified flow control.
+func (sq *sendQueue) fill(requests []pb.Message, sz uint64,
+	affected nodeMap, fc *flowControl) ([]pb.Message, uint64) {
+	for sz < maxMsgBatchSize {
+		select {
+		case req := <-sq.ctrl:
+			requests, sz = sq.add(requests, sz, req, affected)
+		default:
+			if !fc.allowed() {
+				return requests, sz
+			}
+			select {
+			case req := <-sq.ctrl:
+				requests, sz = sq.add(requests, sz, req, affected)
+			case req := <-sq.ch:
+				requests, sz = sq.add(requests, sz, req, affected)
+				fc.consume(req)
+			default:
+				return requests, sz
 			}
-			sz = 0
-			requests, batch = lazyFree(requests, batch)
-			requests = requests[:0]
 		}
 	}
+	return requests, sz
+}
+
+func (sq *sendQueue) add(requests []pb.Message, sz uint64,
+	req pb.Message, affected nodeMap) ([]pb.Message, uint64) {
+	n := raftio.NodeInfo{
+		ShardID:   req.ShardID,
+		ReplicaID: req.From,
+	}
+	affected[n] = struct{}{}
+	sq.decrease(req)
+	return append(requests, req), sz + uint64(req.SizeUpperLimit())
 }
 
 func lazyFree(reqs []pb.Message,
@@ -519,7 +868,7 @@ func lazyFree(reqs []pb.Message,
 }
 
 func (t *Transport) sendMessageBatch(conn raftio.IConnection,
-	batch pb.MessageBatch) error {
+	batch pb.MessageBatch, stats *peerStats) error {
 	if f := t.preSendBatch.Load(); f != nil {
 		updated, shouldSend := f.(SendMessageBatchFunc)(batch)
 		if !shouldSend {
@@ -529,9 +878,11 @@ func (t *Transport) sendMessageBatch(conn raftio.IConnection,
 	}
 	if err := conn.SendMessageBatch(batch); err != nil {
 		t.metrics.messageSendFailure(uint64(len(batch.Requests)))
+		stats.dropped(uint64(len(batch.Requests)))
 		return err
 	}
 	t.metrics.messageSendSuccess(uint64(len(batch.Requests)))
+	stats.sent(uint64(len(batch.Requests)), uint64(batch.Size()))
 	return nil
 }
 
@@ -16,17 +16,22 @@ package transport
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/rand"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/cockroachdb/errors"
 	"github.com/lni/goutils/leaktest"
 	"github.com/lni/goutils/netutil"
 	"github.com/lni/goutils/syncutil"
@@ -67,8 +72,13 @@ func getTestPort() int {
 
 type dummyTransportEvent struct{}
 
-func (d *dummyTransportEvent) ConnectionEstablished(addr string, snapshot bool) {}
-func (d *dummyTransportEvent) ConnectionFailed(addr string, snapshot bool)      {}
+func (d *dummyTransportEvent) ConnectionEstablished(addr string, snapshot bool)    {}
+func (d *dummyTransportEvent) ConnectionFailed(addr string, snapshot bool)         {}
+func (d *dummyTransportEvent) ConnectionRejected(addr string)                      {}
+func (d *dummyTransportEvent) MisdeliveredMessage(string, uint64, uint64)          {}
+func (d *dummyTransportEvent) SnapshotReceiveStarted(raftio.SnapshotInfo)          {}
+func (d *dummyTransportEvent) SnapshotReceiveProgress(raftio.SnapshotProgressInfo) {}
+func (d *dummyTransportEvent) SnapshotReceiveAborted(raftio.SnapshotAbortInfo)     {}
 
 type testSnapshotDir struct {
 	fs vfs.IFS
@@ -282,6 +292,11 @@ func (h *testMessageHandler) getReceivedSnapshotFromCount(shardID uint64,
 	return h.getMessageCount(h.receivedSnapshotFromCount, shardID, replicaID)
 }
 
+func (h *testMessageHandler) getUnreachableCount(shardID uint64,
+	replicaID uint64) uint64 {
+	return h.getMessageCount(h.unreachableCount, shardID, replicaID)
+}
+
 func (h *testMessageHandler) getRequestCount(shardID uint64,
 	replicaID uint64) uint64 {
 	return h.getMessageCount(h.requestCount, shardID, replicaID)
@@ -315,6 +330,13 @@ func (h *testMessageHandler) getMessageCount(m map[raftio.NodeInfo]uint64,
 }
 
 func newNOOPTestTransport(handler IMessageHandler, fs vfs.IFS) (*Transport,
+	*registry.Registry, *NOOPTransport, *noopRequest, *noopConnectRequest) {
+	return newNOOPTestTransportWithEngineConfig(handler,
+		fs, config.EngineConfig{})
+}
+
+func newNOOPTestTransportWithEngineConfig(handler IMessageHandler,
+	fs vfs.IFS, ec config.EngineConfig) (*Transport,
 	*registry.Registry, *NOOPTransport, *noopRequest, *noopConnectRequest) {
 	t := newTestSnapshotDir(fs)
 	nodes := registry.NewNodeRegistry(settings.Soft.StreamConnections, nil)
@@ -323,6 +345,7 @@ func newNOOPTestTransport(handler IMessageHandler, fs vfs.IFS) (*Transport,
 		RaftAddress:      "localhost:9876",
 		Expert: config.ExpertConfig{
 			TransportFactory: &NOOPTransportFactory{},
+			Engine:           ec,
 		},
 	}
 	env, err := server.NewEnv(c, fs)
@@ -344,9 +367,6 @@ func newNOOPTestTransport(handler IMessageHandler, fs vfs.IFS) (*Transport,
 func newTestTransport(handler IMessageHandler,
 	mutualTLS bool, fs vfs.IFS) (*Transport, *registry.Registry,
 	*syncutil.Stopper, *testSnapshotDir) {
-	stopper := syncutil.NewStopper()
-	nodes := registry.NewNodeRegistry(settings.Soft.StreamConnections, nil)
-	t := newTestSnapshotDir(fs)
 	c := config.NodeHostConfig{
 		RaftAddress: serverAddress,
 	}
@@ -356,6 +376,15 @@ func newTestTransport(handler IMessageHandler,
 		c.CertFile = certFile
 		c.KeyFile = keyFile
 	}
+	return newTestTransportWithConfig(handler, c, fs)
+}
+
+func newTestTransportWithConfig(handler IMessageHandler,
+	c config.NodeHostConfig, fs vfs.IFS) (*Transport, *registry.Registry,
+	*syncutil.Stopper, *testSnapshotDir) {
+	stopper := syncutil.NewStopper()
+	nodes := registry.NewNodeRegistry(settings.Soft.StreamConnections, nil)
+	t := newTestSnapshotDir(fs)
 	env, err := server.NewEnv(c, fs)
 	if err != nil {
 		panic(err)
@@ -365,6 +394,20 @@ func newTestTransport(handler IMessageHandler,
 	if err != nil {
 		panic(err)
 	}
+	// drives the timer wheel as the NodeHost tick would
+	stopper.RunWorker(func() {
+		wheel := env.GetTimerWheel()
+		ticker := time.NewTicker(wheel.Interval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				wheel.Tick()
+			case <-stopper.ShouldStop():
+				return
+			}
+		}
+	})
 	return transport, nodes, stopper, t
 }
 
@@ -1473,3 +1516,1834 @@ func TestInMemoryEntrySizeCanDropToZero(t *testing.T) {
 		}
 	}
 }
+
+func TestControlMessagesJumpAheadOfBulkMessages(t *testing.T) {
+	fs := vfs.GetTestFS()
+	handler := newTestMessageHandler()
+	tt, nodes, _, _, _ := newNOOPTestTransport(handler, fs)
+	defer func() {
+		if err := tt.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	nodes.Add(100, 2, serverAddress)
+	// each batch with entries takes 50ms to send to simulate a saturated
+	// slow connection
+	var mu sync.Mutex
+	var sent []raftpb.MessageType
+	var heartbeatSentAt time.Time
+	tt.SetPreSendBatchHook(func(b raftpb.MessageBatch) (raftpb.MessageBatch, bool) {
+		bulk := false
+		mu.Lock()
+		for _, req := range b.Requests {
+			sent = append(sent, req.Type)
+			if req.Type == raftpb.Heartbeat {
+				heartbeatSentAt = time.Now()
+			}
+			if req.Type == raftpb.Replicate {
+				bulk = true
+			}
+		}
+		mu.Unlock()
+		if bulk {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return b, true
+	})
+	e := raftpb.Entry{Cmd: make([]byte, maxMsgBatchSize/2)}
+	msg := raftpb.Message{
+		ShardID: 100,
+		To:      2,
+		Type:    raftpb.Replicate,
+		Entries: []raftpb.Entry{e},
+	}
+	count := 6
+	for i := 0; i < count; i++ {
+		if !tt.Send(msg) {
+			t.Fatalf("failed to send replicate message")
+		}
+	}
+	start := time.Now()
+	hb := raftpb.Message{ShardID: 100, To: 2, Type: raftpb.Heartbeat}
+	if !tt.Send(hb) {
+		t.Fatalf("failed to send heartbeat message")
+	}
+	for i := 0; i < 1000; i++ {
+		mu.Lock()
+		done := len(sent) == count+1
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != count+1 {
+		t.Fatalf("got %d messages, want %d", len(sent), count+1)
+	}
+	if sent[len(sent)-1] == raftpb.Heartbeat {
+		t.Errorf("heartbeat did not jump ahead of bulk messages")
+	}
+	if rtt := heartbeatSentAt.Sub(start); rtt > 150*time.Millisecond {
+		t.Errorf("heartbeat delayed for %v", rtt)
+	}
+}
+
+func TestControlMessagesAreNotRateLimited(t *testing.T) {
+	fs := vfs.GetTestFS()
+	handler := newTestMessageHandler()
+	tt, nodes, _, req, _ := newNOOPTestTransport(handler, fs)
+	defer func() {
+		req.SetBlocked(false)
+		if err := tt.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	nodes.Add(100, 2, serverAddress)
+	e := raftpb.Entry{Cmd: make([]byte, 1024*1024*10)}
+	msg := raftpb.Message{
+		ShardID: 100,
+		To:      2,
+		Type:    raftpb.Replicate,
+		Entries: []raftpb.Entry{e},
+	}
+	req.SetBlocked(true)
+	for i := 0; i < 1000; i++ {
+		if sent, reason := tt.send(msg); !sent {
+			if reason != rateLimited {
+				t.Fatalf("not due to rate limit")
+			}
+			break
+		}
+	}
+	hb := raftpb.Message{ShardID: 100, To: 2, Type: raftpb.Heartbeat}
+	if sent, reason := tt.send(hb); !sent {
+		t.Errorf("heartbeat rejected, %d", reason)
+	}
+}
+
+func TestPeerStatsAreUpdated(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	handler := newTestMessageHandler()
+	trans, nodes, stopper, _ := newTestTransport(handler, false, fs)
+	defer func() {
+		if err := trans.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer func() {
+		if err := trans.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer stopper.Stop()
+	nodes.Add(100, 2, serverAddress)
+	for i := 0; i < 20; i++ {
+		msg := raftpb.Message{
+			Type:    raftpb.Heartbeat,
+			To:      2,
+			ShardID: 100,
+		}
+		if !trans.Send(msg) {
+			t.Errorf("failed to send message")
+		}
+	}
+	for i := 0; i < 200; i++ {
+		if handler.getRequestCount(100, 2) == 20 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := trans.GetPeerStats()
+	if len(stats) != 1 {
+		t.Fatalf("unexpected stats count %d", len(stats))
+	}
+	ps := stats[0]
+	if ps.Address != serverAddress {
+		t.Errorf("unexpected address %s", ps.Address)
+	}
+	if ps.MessagesSent != 20 || ps.BytesSent == 0 {
+		t.Errorf("unexpected sent counters %+v", ps)
+	}
+	if ps.MessagesReceived != 20 || ps.BytesReceived == 0 {
+		t.Errorf("unexpected received counters %+v", ps)
+	}
+	if ps.ConnectionsEstablished != 1 || ps.ConnectionsFailed != 0 {
+		t.Errorf("unexpected connection counters %+v", ps)
+	}
+	if ps.MessagesDropped != 0 || ps.QueueLength != 0 {
+		t.Errorf("unexpected queue counters %+v", ps)
+	}
+	if ps.TimeSinceLastSend == 0 {
+		t.Errorf("time since last send not set")
+	}
+}
+
+func TestPeerStatsCountDroppedMessages(t *testing.T) {
+	fs := vfs.GetTestFS()
+	handler := newTestMessageHandler()
+	tt, nodes, _, req, _ := newNOOPTestTransport(handler, fs)
+	defer func() {
+		req.SetBlocked(false)
+		if err := tt.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	nodes.Add(100, 2, serverAddress)
+	req.SetBlocked(true)
+	msg := raftpb.Message{ShardID: 100, To: 2, Type: raftpb.Heartbeat}
+	dropped := uint64(0)
+	for i := uint64(0); i < sendQueueLen*2; i++ {
+		if !tt.Send(msg) {
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		t.Fatalf("no message dropped")
+	}
+	stats := tt.GetPeerStats()
+	if len(stats) != 1 {
+		t.Fatalf("unexpected stats count %d", len(stats))
+	}
+	if stats[0].MessagesDropped != dropped {
+		t.Errorf("dropped %d, want %d", stats[0].MessagesDropped, dropped)
+	}
+	if stats[0].QueueLength == 0 {
+		t.Errorf("queue length not reported")
+	}
+}
+
+func TestPeerStatsRecordConnectionFailure(t *testing.T) {
+	fs := vfs.GetTestFS()
+	handler := newTestMessageHandler()
+	tt, nodes, _, _, connReq := newNOOPTestTransport(handler, fs)
+	defer func() {
+		if err := tt.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	nodes.Add(100, 2, serverAddress)
+	connReq.SetToFail(true)
+	msg := raftpb.Message{ShardID: 100, To: 2, Type: raftpb.Heartbeat}
+	tt.Send(msg)
+	for i := 0; i < 200; i++ {
+		stats := tt.GetPeerStats()
+		if len(stats) == 1 && stats[0].ConnectionsFailed == 1 {
+			if stats[0].LastError != ErrRequestedToFail.Error() {
+				t.Errorf("unexpected last error %s", stats[0].LastError)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("connection failure not counted")
+}
+
+func getStalledSendQueue(t *testing.T, ec config.EngineConfig) (*Transport,
+	sendQueue, *noopRequest) {
+	fs := vfs.GetTestFS()
+	handler := newTestMessageHandler()
+	tt, nodes, _, req, _ := newNOOPTestTransportWithEngineConfig(handler, fs, ec)
+	nodes.Add(100, 2, serverAddress)
+	_, key, err := nodes.Resolve(100, 2)
+	if err != nil {
+		t.Fatalf("failed to resolve the addr")
+	}
+	req.SetBlocked(true)
+	// the first message is picked up by the worker which then stalls
+	if !tt.Send(getTestReplicateMessage(0)) {
+		t.Fatalf("failed to send the first message")
+	}
+	tt.mu.Lock()
+	sq := tt.mu.queues[key]
+	tt.mu.Unlock()
+	for len(sq.ch) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	return tt, sq, req
+}
+
+func closeStalledTransport(t *testing.T, tt *Transport, req *noopRequest) {
+	req.SetBlocked(false)
+	if err := tt.Close(); err != nil {
+		t.Fatalf("failed to close the transport module %v", err)
+	}
+}
+
+func getTestReplicateMessage(index uint64) raftpb.Message {
+	return raftpb.Message{
+		ShardID:  100,
+		To:       2,
+		Type:     raftpb.Replicate,
+		LogIndex: index,
+		Entries:  []raftpb.Entry{{Index: index + 1, Cmd: make([]byte, 1024)}},
+	}
+}
+
+func TestDropNewestOverflowPolicy(t *testing.T) {
+	ec := config.EngineConfig{SendQueueLength: 4}
+	tt, sq, req := getStalledSendQueue(t, ec)
+	defer closeStalledTransport(t, tt, req)
+	for i := uint64(1); i <= 4; i++ {
+		if !tt.Send(getTestReplicateMessage(i)) {
+			t.Fatalf("failed to send message %d", i)
+		}
+	}
+	if sent, reason := tt.send(getTestReplicateMessage(5)); sent {
+		t.Fatalf("unexpectedly sent")
+	} else if reason != chanIsFull {
+		t.Errorf("unexpected reason %d", reason)
+	}
+	if v := (<-sq.ch).LogIndex; v != 1 {
+		t.Errorf("oldest message %d, want 1", v)
+	}
+	if stats := tt.GetPeerStats(); stats[0].MessagesDropped != 1 {
+		t.Errorf("dropped %d, want 1", stats[0].MessagesDropped)
+	}
+}
+
+func TestDropOldestNonCriticalOverflowPolicy(t *testing.T) {
+	ec := config.EngineConfig{
+		SendQueueLength:         4,
+		SendQueueOverflowPolicy: config.DropOldestNonCritical,
+	}
+	tt, sq, req := getStalledSendQueue(t, ec)
+	defer closeStalledTransport(t, tt, req)
+	for i := uint64(1); i <= 6; i++ {
+		if !tt.Send(getTestReplicateMessage(i)) {
+			t.Fatalf("failed to send message %d", i)
+		}
+	}
+	if v := (<-sq.ch).LogIndex; v != 3 {
+		t.Errorf("oldest message %d, want 3", v)
+	}
+	// control messages are never dropped to make room
+	hb := raftpb.Message{ShardID: 100, To: 2, Type: raftpb.Heartbeat}
+	for i := 0; i < 4; i++ {
+		if !tt.Send(hb) {
+			t.Fatalf("failed to send heartbeat")
+		}
+	}
+	if tt.Send(hb) {
+		t.Errorf("control message unexpectedly sent")
+	}
+	if stats := tt.GetPeerStats(); stats[0].MessagesDropped != 3 {
+		t.Errorf("dropped %d, want 3", stats[0].MessagesDropped)
+	}
+}
+
+func TestDropOldestNonCriticalReleasesQueuedBytes(t *testing.T) {
+	ec := config.EngineConfig{
+		SendQueueLength:         4,
+		SendQueueOverflowPolicy: config.DropOldestNonCritical,
+	}
+	tt, sq, req := getStalledSendQueue(t, ec)
+	defer closeStalledTransport(t, tt, req)
+	for i := uint64(1); i <= 4; i++ {
+		if !tt.Send(getTestReplicateMessage(i)) {
+			t.Fatalf("failed to send message %d", i)
+		}
+	}
+	queued := sq.rl.Get()
+	for i := uint64(5); i <= 10; i++ {
+		if !tt.Send(getTestReplicateMessage(i)) {
+			t.Fatalf("failed to send message %d", i)
+		}
+	}
+	if v := sq.rl.Get(); v != queued {
+		t.Errorf("queued bytes %d, want %d", v, queued)
+	}
+}
+
+func TestBlockWithDeadlineOverflowPolicy(t *testing.T) {
+	ec := config.EngineConfig{
+		SendQueueLength:         4,
+		SendQueueOverflowPolicy: config.BlockWithDeadline,
+		SendQueueBlockTimeoutMS: 50,
+	}
+	tt, sq, req := getStalledSendQueue(t, ec)
+	defer closeStalledTransport(t, tt, req)
+	for i := uint64(1); i <= 4; i++ {
+		if !tt.Send(getTestReplicateMessage(i)) {
+			t.Fatalf("failed to send message %d", i)
+		}
+	}
+	start := time.Now()
+	if tt.Send(getTestReplicateMessage(5)) {
+		t.Fatalf("unexpectedly sent")
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("sender not blocked")
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-sq.ch
+	}()
+	if !tt.Send(getTestReplicateMessage(6)) {
+		t.Errorf("failed to send after room became available")
+	}
+	if stats := tt.GetPeerStats(); stats[0].MessagesDropped != 1 {
+		t.Errorf("dropped %d, want 1", stats[0].MessagesDropped)
+	}
+}
+
+func TestSendQueueBytesIsRespected(t *testing.T) {
+	ec := config.EngineConfig{SendQueueBytes: 16 * 1024}
+	tt, sq, req := getStalledSendQueue(t, ec)
+	defer closeStalledTransport(t, tt, req)
+	dropped := uint64(0)
+	for i := uint64(1); i <= 100; i++ {
+		sent, reason := tt.send(getTestReplicateMessage(i))
+		if !sent {
+			if reason != rateLimited {
+				t.Fatalf("not due to rate limit")
+			}
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		t.Fatalf("no message rejected")
+	}
+	msg := getTestReplicateMessage(0)
+	limit := ec.SendQueueBytes + raftpb.GetEntrySliceInMemSize(msg.Entries)
+	if v := sq.rl.Get(); v > limit {
+		t.Errorf("queued bytes %d, limit %d", v, limit)
+	}
+	if stats := tt.GetPeerStats(); stats[0].MessagesDropped != dropped {
+		t.Errorf("dropped %d, want %d", stats[0].MessagesDropped, dropped)
+	}
+}
+
+type testSideloader struct {
+	mu        sync.Mutex
+	fs        vfs.IFS
+	dir       string
+	offered   int
+	fetched   int
+	failFetch bool
+	corrupt   bool
+}
+
+func (s *testSideloader) Offer(meta raftio.SnapshotMeta) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offered++
+	if err := s.fs.MkdirAll(s.dir, 0755); err != nil {
+		panic(err)
+	}
+	locator := s.fs.PathJoin(s.dir,
+		fmt.Sprintf("snapshot-%d-%d", meta.ShardID, meta.Index))
+	src, err := s.fs.Open(meta.Filepath)
+	if err != nil {
+		panic(err)
+	}
+	defer src.Close()
+	dst, err := s.fs.Create(locator)
+	if err != nil {
+		panic(err)
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		panic(err)
+	}
+	return locator, true
+}
+
+func (s *testSideloader) Fetch(ctx context.Context,
+	locator string, dst raftio.SnapshotWriter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetched++
+	if s.failFetch {
+		return errors.New("fetch failed")
+	}
+	src, err := s.fs.Open(locator)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	if s.corrupt {
+		data[len(data)/2]++
+	}
+	_, err = dst.Write(data)
+	return err
+}
+
+func (s *testSideloader) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.offered, s.fetched
+}
+
+func testSnapshotSideloading(t *testing.T, sideloader *testSideloader,
+	tf func(*Transport, *testMessageHandler, *testSnapshotDir, *uint64)) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	handler := newTestMessageHandler()
+	trans, nodes, stopper, tt := newTestTransport(handler, false, fs)
+	defer func() {
+		if err := fs.RemoveAll(snapshotDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	defer func() {
+		if err := trans.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer tt.cleanup()
+	defer func() {
+		if err := trans.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer stopper.Stop()
+	sideloader.fs = fs
+	sideloader.dir = fs.PathJoin(snapshotDir, "shared")
+	trans.nhConfig.SnapshotSideloader = sideloader
+	trans.chunks.sideloader = sideloader
+	var streamed uint64
+	trans.SetPreStreamChunkSendHook(func(c raftpb.Chunk) (raftpb.Chunk, bool) {
+		atomic.AddUint64(&streamed, uint64(len(c.Data)))
+		return c, true
+	})
+	nodes.Add(100, 2, serverAddress)
+	tt.generateSnapshotFile(100, 12, testSnapshotIndex,
+		"testsnapshot.gbsnap", snapshotChunkSize*3, fs)
+	if err := fs.MkdirAll(trans.dir(100, 2), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	tf(trans, handler, tt, &streamed)
+}
+
+func sendTestSideloadSnapshot(t *testing.T,
+	trans *Transport, tt *testSnapshotDir) {
+	m := getTestSnapshotMessage(2)
+	m.Snapshot.FileSize = getTestSnapshotFileSize(snapshotChunkSize * 3)
+	dir := tt.GetSnapshotDir(100, 12, testSnapshotIndex)
+	m.Snapshot.Filepath = tt.fs.PathJoin(dir, "testsnapshot.gbsnap")
+	if !trans.SendSnapshot(m) {
+		t.Fatalf("failed to send the snapshot")
+	}
+}
+
+func TestSnapshotCanBeSideloaded(t *testing.T) {
+	sideloader := &testSideloader{}
+	tf := func(trans *Transport,
+		handler *testMessageHandler, tt *testSnapshotDir, streamed *uint64) {
+		sendTestSideloadSnapshot(t, trans, tt)
+		waitForSnapshotCountUpdate(handler, 10000)
+		if handler.getReceivedSnapshotCount(100, 2) != 1 {
+			t.Fatalf("snapshot not received")
+		}
+		if offered, fetched := sideloader.counts(); offered != 1 || fetched != 1 {
+			t.Errorf("offered %d, fetched %d", offered, fetched)
+		}
+		if v := atomic.LoadUint64(streamed); v != 0 {
+			t.Errorf("%d bytes of snapshot data streamed", v)
+		}
+		md5Original, err := tt.getSnapshotFileMD5(100,
+			12, testSnapshotIndex, "testsnapshot.gbsnap")
+		if err != nil {
+			t.Fatalf("err %v, want nil", err)
+		}
+		md5Received, err := tt.getSnapshotFileMD5(100,
+			2, testSnapshotIndex, "testsnapshot.gbsnap")
+		if err != nil {
+			t.Fatalf("err %v, want nil", err)
+		}
+		if !bytes.Equal(md5Original, md5Received) {
+			t.Errorf("snapshot content changed during sideloading")
+		}
+	}
+	testSnapshotSideloading(t, sideloader, tf)
+}
+
+func testSideloadFallsBackToStreaming(t *testing.T,
+	sideloader *testSideloader) {
+	tf := func(trans *Transport,
+		handler *testMessageHandler, tt *testSnapshotDir, streamed *uint64) {
+		sendTestSideloadSnapshot(t, trans, tt)
+		for i := 0; i < 1000; i++ {
+			if _, fetched := sideloader.counts(); fetched == 1 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if handler.getReceivedSnapshotCount(100, 2) != 0 {
+			t.Fatalf("unexpected snapshot received")
+		}
+		// the same snapshot is streamed when sent again
+		sendTestSideloadSnapshot(t, trans, tt)
+		waitForSnapshotCountUpdate(handler, 10000)
+		if handler.getReceivedSnapshotCount(100, 2) != 1 {
+			t.Fatalf("snapshot not received")
+		}
+		if offered, fetched := sideloader.counts(); offered != 1 || fetched != 1 {
+			t.Errorf("offered %d, fetched %d", offered, fetched)
+		}
+		if v := atomic.LoadUint64(streamed); v == 0 {
+			t.Errorf("snapshot not streamed")
+		}
+	}
+	testSnapshotSideloading(t, sideloader, tf)
+}
+
+func TestSideloadFallsBackToStreamingWhenFetchFailed(t *testing.T) {
+	testSideloadFallsBackToStreaming(t, &testSideloader{failFetch: true})
+}
+
+func TestCorruptedSideloadedSnapshotIsRejected(t *testing.T) {
+	testSideloadFallsBackToStreaming(t, &testSideloader{corrupt: true})
+}
+
+func testMessageCanBeSentToListenAddresses(t *testing.T,
+	c config.NodeHostConfig, fs vfs.IFS) {
+	handler := newTestMessageHandler()
+	trans, nodes, stopper, _ := newTestTransportWithConfig(handler, c, fs)
+	defer func() {
+		if err := trans.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer func() {
+		if err := trans.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer stopper.Stop()
+	nodes.Add(100, 2, c.RaftAddress)
+	for i := 0; i < 20; i++ {
+		msg := raftpb.Message{
+			Type:    raftpb.Heartbeat,
+			To:      2,
+			ShardID: 100,
+		}
+		if !trans.Send(msg) {
+			t.Errorf("failed to send message")
+		}
+	}
+	for i := 0; i < 200; i++ {
+		if handler.getRequestCount(100, 2) == 20 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("got %d, want 20", handler.getRequestCount(100, 2))
+}
+
+func TestIPv6ListenerAcceptsIPv4MappedPeer(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	port := getTestPort() + 1
+	c := config.NodeHostConfig{
+		RaftAddress:     fmt.Sprintf("127.0.0.1:%d", port),
+		ListenAddresses: []string{fmt.Sprintf("[::]:%d", port)},
+	}
+	testMessageCanBeSentToListenAddresses(t, c, fs)
+}
+
+func TestMultipleListenAddressesCanBeUsed(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	port := getTestPort() + 1
+	c := config.NodeHostConfig{
+		RaftAddress: fmt.Sprintf("127.0.0.1:%d", port+1),
+		ListenAddresses: []string{
+			fmt.Sprintf("[::1]:%d", port),
+			fmt.Sprintf("127.0.0.1:%d", port+1),
+		},
+	}
+	testMessageCanBeSentToListenAddresses(t, c, fs)
+}
+
+// testProxy forwards all connections received on the from address to the to
+// address, it emulates the NAT'd port used for the advertised address. All
+// forwarded traffic is silently dropped once the proxy is blackholed.
+type testProxy struct {
+	ln         net.Listener
+	wg         sync.WaitGroup
+	mu         sync.Mutex
+	conns      []net.Conn
+	blackholed uint32
+}
+
+func runTestProxy(t *testing.T, from string, to string) *testProxy {
+	ln, err := net.Listen("tcp", from)
+	if err != nil {
+		t.Fatalf("failed to listen %v", err)
+	}
+	p := &testProxy{ln: ln}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			target, err := net.Dial("tcp", to)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			p.track(conn)
+			p.track(target)
+			p.wg.Add(2)
+			go func() {
+				defer p.wg.Done()
+				p.copy(target, conn)
+				target.Close()
+			}()
+			go func() {
+				defer p.wg.Done()
+				p.copy(conn, target)
+				conn.Close()
+			}()
+		}
+	}()
+	return p
+}
+
+func (p *testProxy) track(c net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns = append(p.conns, c)
+}
+
+func (p *testProxy) connections() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns) / 2
+}
+
+func (p *testProxy) blackhole() {
+	atomic.StoreUint32(&p.blackholed, 1)
+}
+
+func (p *testProxy) copy(dst net.Conn, src net.Conn) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		if atomic.LoadUint32(&p.blackholed) == 1 {
+			continue
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func (p *testProxy) stop() {
+	p.ln.Close()
+	p.mu.Lock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+func TestAdvertisedPortCanBeDifferentFromListenPort(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	port := getTestPort() + 1
+	advertised := fmt.Sprintf("127.0.0.1:%d", port)
+	listen := fmt.Sprintf("127.0.0.1:%d", port+1)
+	p := runTestProxy(t, advertised, listen)
+	defer p.stop()
+	c := config.NodeHostConfig{
+		RaftAddress:     advertised,
+		ListenAddresses: []string{listen},
+	}
+	testMessageCanBeSentToListenAddresses(t, c, fs)
+}
+
+type testTransportEvent struct {
+	mu           sync.Mutex
+	started      []raftio.SnapshotInfo
+	progress     []raftio.SnapshotProgressInfo
+	aborted      []raftio.SnapshotAbortInfo
+	rejected     []string
+	misdelivered []raftio.MisdeliveredMessageInfo
+	failed       uint64
+}
+
+func (e *testTransportEvent) ConnectionEstablished(addr string, snapshot bool) {}
+func (e *testTransportEvent) ConnectionFailed(addr string, snapshot bool) {
+	atomic.AddUint64(&e.failed, 1)
+}
+
+func (e *testTransportEvent) ConnectionRejected(addr string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rejected = append(e.rejected, addr)
+}
+
+func (e *testTransportEvent) getRejected() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string{}, e.rejected...)
+}
+
+func (e *testTransportEvent) MisdeliveredMessage(addr string,
+	shardID uint64, replicaID uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.misdelivered = append(e.misdelivered, raftio.MisdeliveredMessageInfo{
+		Address:   addr,
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+	})
+}
+
+func (e *testTransportEvent) getMisdelivered() []raftio.MisdeliveredMessageInfo {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]raftio.MisdeliveredMessageInfo{}, e.misdelivered...)
+}
+
+func (e *testTransportEvent) SnapshotReceiveStarted(info raftio.SnapshotInfo) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.started = append(e.started, info)
+}
+
+func (e *testTransportEvent) SnapshotReceiveProgress(
+	info raftio.SnapshotProgressInfo) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.progress = append(e.progress, info)
+}
+
+func (e *testTransportEvent) SnapshotReceiveAborted(info raftio.SnapshotAbortInfo) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.aborted = append(e.aborted, info)
+}
+
+func (e *testTransportEvent) getEvents() ([]raftio.SnapshotInfo,
+	[]raftio.SnapshotProgressInfo, []raftio.SnapshotAbortInfo) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]raftio.SnapshotInfo{}, e.started...),
+		append([]raftio.SnapshotProgressInfo{}, e.progress...),
+		append([]raftio.SnapshotAbortInfo{}, e.aborted...)
+}
+
+func TestQueuedMessagesAreDrainedOnClose(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	handler := newTestMessageHandler()
+	c := config.NodeHostConfig{
+		RaftAddress: serverAddress,
+		Expert:      config.ExpertConfig{TransportDrainTimeout: 5 * time.Second},
+	}
+	trans, nodes, stopper, _ := newTestTransportWithConfig(handler, c, fs)
+	defer func() {
+		if err := trans.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer stopper.Stop()
+	events := &testTransportEvent{}
+	trans.sysEvents = events
+	started := make(chan struct{}, 1)
+	trans.SetPreSendBatchHook(func(b raftpb.MessageBatch) (raftpb.MessageBatch, bool) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		time.Sleep(100 * time.Millisecond)
+		return b, true
+	})
+	nodes.Add(100, 2, serverAddress)
+	msg := raftpb.Message{
+		Type:    raftpb.Heartbeat,
+		To:      2,
+		ShardID: 100,
+	}
+	if !trans.Send(msg) {
+		t.Fatalf("failed to send message")
+	}
+	<-started
+	for i := 0; i < 10; i++ {
+		if !trans.Send(msg) {
+			t.Fatalf("failed to send message")
+		}
+	}
+	if err := trans.Close(); err != nil {
+		t.Fatalf("failed to close the transport module %v", err)
+	}
+	if count := handler.getRequestCount(100, 2); count != 11 {
+		t.Errorf("got %d, want 11", count)
+	}
+	if trans.Send(msg) {
+		t.Errorf("message accepted by closed transport")
+	}
+	if v := atomic.LoadUint64(&events.failed); v != 0 {
+		t.Errorf("unexpected connection failures %d", v)
+	}
+}
+
+func TestRemoveConnectionsClosesQueues(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	handler := newTestMessageHandler()
+	trans, nodes, stopper, _ := newTestTransport(handler, false, fs)
+	defer func() {
+		if err := trans.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer func() {
+		if err := trans.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer stopper.Stop()
+	nodes.Add(100, 2, serverAddress)
+	msg := raftpb.Message{
+		Type:    raftpb.Heartbeat,
+		To:      2,
+		ShardID: 100,
+	}
+	waitFor := func(count uint64) {
+		for i := 0; i < 200; i++ {
+			if handler.getRequestCount(100, 2) == count {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("got %d, want %d", handler.getRequestCount(100, 2), count)
+	}
+	if !trans.Send(msg) {
+		t.Fatalf("failed to send message")
+	}
+	waitFor(1)
+	trans.RemoveConnections("unknown:12345")
+	trans.mu.Lock()
+	queues := len(trans.mu.queues)
+	trans.mu.Unlock()
+	if queues != 1 {
+		t.Fatalf("unexpected queue count %d", queues)
+	}
+	trans.RemoveConnections(serverAddress)
+	trans.mu.Lock()
+	queues = len(trans.mu.queues)
+	trans.mu.Unlock()
+	if queues != 0 {
+		t.Fatalf("queue not removed")
+	}
+	if !trans.Send(msg) {
+		t.Fatalf("failed to send message")
+	}
+	waitFor(2)
+}
+
+func TestStreamedSnapshotIsAbortedOnClose(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer func() {
+		if err := fs.RemoveAll(snapshotDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	defer leaktest.AfterTest(t)()
+	rc := config.NodeHostConfig{
+		RaftAddress: fmt.Sprintf("localhost:%d", getTestPort()+1),
+	}
+	receiver, _, rstopper, rdir := newTestTransportWithConfig(
+		newTestMessageHandler(), rc, fs)
+	defer func() {
+		if err := receiver.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer func() {
+		if err := receiver.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer rstopper.Stop()
+	defer rdir.cleanup()
+	events := &testTransportEvent{}
+	receiver.sysEvents = events
+	receiver.chunks.validate = false
+	sender, nodes, sstopper, _ := newTestTransport(newTestMessageHandler(),
+		false, fs)
+	defer func() {
+		if err := sender.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer sstopper.Stop()
+	chunk := getTestChunk()[0]
+	if err := fs.MkdirAll(receiver.dir(chunk.ShardID, chunk.ReplicaID),
+		0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	nodes.Add(chunk.ShardID, chunk.ReplicaID, rc.RaftAddress)
+	sink := sender.GetStreamSink(chunk.ShardID, chunk.ReplicaID)
+	if sink == nil {
+		t.Fatalf("failed to get the sink")
+	}
+	if sent, _ := sink.Receive(chunk); !sent {
+		t.Fatalf("failed to send the chunk")
+	}
+	received := false
+	for i := 0; i < 200; i++ {
+		if len(receiver.chunks.getTracked()) == 1 {
+			received = true
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !received {
+		t.Fatalf("chunk not received")
+	}
+	if err := sender.Close(); err != nil {
+		t.Fatalf("failed to close the transport module %v", err)
+	}
+	if len(receiver.chunks.getTracked()) != 0 {
+		t.Errorf("partial snapshot not discarded")
+	}
+	if hasSnapshotTempFile(receiver.chunks, chunk) {
+		t.Errorf("temp file not removed")
+	}
+	if v := atomic.LoadUint64(&events.failed); v != 0 {
+		t.Errorf("unexpected connection failures %d", v)
+	}
+}
+
+func testIdleConnectionWithPing(t *testing.T, blackhole bool) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	handler := newTestMessageHandler()
+	c := config.NodeHostConfig{
+		RaftAddress: serverAddress,
+		Expert: config.ExpertConfig{
+			TransportPingInterval: 50 * time.Millisecond,
+			MaxSendStallDuration:  200 * time.Millisecond,
+		},
+	}
+	trans, nodes, stopper, _ := newTestTransportWithConfig(handler, c, fs)
+	defer func() {
+		if err := trans.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer func() {
+		if err := trans.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer stopper.Stop()
+	addr := fmt.Sprintf("localhost:%d", getTestPort()+1)
+	p := runTestProxy(t, addr, serverAddress)
+	defer p.stop()
+	nodes.Add(100, 2, addr)
+	msg := raftpb.Message{
+		Type:    raftpb.Heartbeat,
+		From:    1,
+		To:      2,
+		ShardID: 100,
+	}
+	if !trans.Send(msg) {
+		t.Fatalf("failed to send message")
+	}
+	for i := 0; i < 200; i++ {
+		if handler.getRequestCount(100, 2) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if handler.getRequestCount(100, 2) != 1 {
+		t.Fatalf("message not received")
+	}
+	if blackhole {
+		p.blackhole()
+	}
+	start := time.Now()
+	for time.Since(start) < 2*time.Second {
+		if handler.getUnreachableCount(100, 1) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	unreachable := handler.getUnreachableCount(100, 1) > 0
+	if blackhole {
+		// worst case is two ping intervals plus MaxSendStallDuration
+		if !unreachable {
+			t.Fatalf("blackholed peer not reported as unreachable")
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("took %v to report the unreachable peer", d)
+		}
+		return
+	}
+	if unreachable {
+		t.Fatalf("healthy peer reported as unreachable")
+	}
+	if !trans.Send(msg) {
+		t.Fatalf("failed to send message")
+	}
+	for i := 0; i < 200; i++ {
+		if handler.getRequestCount(100, 2) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if handler.getRequestCount(100, 2) != 2 {
+		t.Fatalf("message not received")
+	}
+	for _, ps := range trans.GetPeerStats() {
+		if ps.Address == addr && ps.ConnectionsEstablished != 1 {
+			t.Errorf("idle connection not kept, %d connections established",
+				ps.ConnectionsEstablished)
+		}
+	}
+}
+
+func TestIdleConnectionIsKeptByPing(t *testing.T) {
+	testIdleConnectionWithPing(t, false)
+}
+
+func TestBlackholedPeerIsReportedAsUnreachable(t *testing.T) {
+	testIdleConnectionWithPing(t, true)
+}
+
+func TestSnapshotReceiveProgressIsReported(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	handler := newTestMessageHandler()
+	trans, nodes, stopper, tt := newTestTransport(handler, false, fs)
+	defer func() {
+		if err := fs.RemoveAll(snapshotDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	defer func() {
+		if err := trans.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer tt.cleanup()
+	defer func() {
+		if err := trans.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer stopper.Stop()
+	events := &testTransportEvent{}
+	trans.chunks.events = events
+	sz := uint64(snapshotChunkSize*3 + 1)
+	nodes.Add(100, 2, serverAddress)
+	tt.generateSnapshotFile(100, 12, testSnapshotIndex, "testsnapshot.gbsnap", sz, fs)
+	m := getTestSnapshotMessage(2)
+	m.Snapshot.FileSize = getTestSnapshotFileSize(sz)
+	dir := tt.GetSnapshotDir(100, 12, testSnapshotIndex)
+	if err := fs.MkdirAll(trans.chunks.dir(100, 2), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	m.Snapshot.Filepath = fs.PathJoin(dir, "testsnapshot.gbsnap")
+	if !trans.SendSnapshot(m) {
+		t.Fatalf("failed to send the snapshot")
+	}
+	waitForSnapshotCountUpdate(handler, 10000)
+	if handler.getReceivedSnapshotCount(100, 2) != 1 {
+		t.Fatalf("snapshot not received")
+	}
+	started, progress, aborted := events.getEvents()
+	if len(started) != 1 {
+		t.Fatalf("got %d started events, want 1", len(started))
+	}
+	if started[0].ShardID != 100 || started[0].ReplicaID != 2 ||
+		started[0].From != 12 || started[0].Index != testSnapshotIndex {
+		t.Errorf("unexpected started event %+v", started[0])
+	}
+	if len(aborted) != 0 {
+		t.Errorf("unexpected aborted events %+v", aborted)
+	}
+	if len(progress) < 2 {
+		t.Fatalf("got %d progress events, want at least 2", len(progress))
+	}
+	for i := 1; i < len(progress); i++ {
+		if progress[i].ReceivedBytes <= progress[i-1].ReceivedBytes {
+			t.Errorf("received bytes not increasing, %d, %d",
+				progress[i-1].ReceivedBytes, progress[i].ReceivedBytes)
+		}
+	}
+	last := progress[len(progress)-1]
+	if last.TotalBytes != m.Snapshot.FileSize ||
+		last.ReceivedBytes != last.TotalBytes {
+		t.Errorf("unexpected last progress event %+v, file size %d",
+			last, m.Snapshot.FileSize)
+	}
+}
+
+func testMultiplexedTransport(t *testing.T,
+	senderMux bool, receiverMux bool, fs vfs.IFS) int {
+	defer func() {
+		if err := fs.RemoveAll(snapshotDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	port := getTestPort() + 1
+	proxyAddress := fmt.Sprintf("localhost:%d", port)
+	rc := config.NodeHostConfig{
+		RaftAddress: fmt.Sprintf("localhost:%d", port+1),
+		Expert:      config.ExpertConfig{TransportMultiplexing: receiverMux},
+	}
+	p := runTestProxy(t, proxyAddress, rc.RaftAddress)
+	defer p.stop()
+	rhandler := newTestMessageHandler()
+	receiver, _, rstopper, _ := newTestTransportWithConfig(rhandler, rc, fs)
+	defer func() {
+		if err := receiver.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer func() {
+		if err := receiver.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer rstopper.Stop()
+	c := config.NodeHostConfig{
+		RaftAddress: serverAddress,
+		Expert:      config.ExpertConfig{TransportMultiplexing: senderMux},
+	}
+	handler := newTestMessageHandler()
+	sender, nodes, stopper, tt := newTestTransportWithConfig(handler, c, fs)
+	defer func() {
+		if err := sender.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer tt.cleanup()
+	defer func() {
+		if err := sender.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer stopper.Stop()
+	nodes.Add(100, 2, proxyAddress)
+	sz := uint64(snapshotChunkSize*3 + 1)
+	tt.generateSnapshotFile(100, 12, testSnapshotIndex, "testsnapshot.gbsnap", sz, fs)
+	m := getTestSnapshotMessage(2)
+	m.Snapshot.FileSize = getTestSnapshotFileSize(sz)
+	m.Snapshot.Filepath = fs.PathJoin(tt.GetSnapshotDir(100,
+		12, testSnapshotIndex), "testsnapshot.gbsnap")
+	if err := fs.MkdirAll(receiver.chunks.dir(100, 2), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !sender.SendSnapshot(m) {
+		t.Fatalf("failed to send the snapshot")
+	}
+	// raft messages are sent while the snapshot is being transferred
+	for i := 0; i < 100; i++ {
+		msg := raftpb.Message{
+			Type:    raftpb.Heartbeat,
+			To:      2,
+			ShardID: 100,
+		}
+		if !sender.Send(msg) {
+			t.Errorf("failed to send message")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	waitForFirstSnapshotStatusUpdate(handler, 10000)
+	waitForSnapshotCountUpdate(rhandler, 10000)
+	if handler.getSnapshotSuccessCount(100, 2) != 1 {
+		t.Errorf("got %d, want 1", handler.getSnapshotSuccessCount(100, 2))
+	}
+	if rhandler.getReceivedSnapshotCount(100, 2) != 1 {
+		t.Errorf("got %d, want 1", rhandler.getReceivedSnapshotCount(100, 2))
+	}
+	// the InstallSnapshot message is also delivered to the request handler
+	for i := 0; i < 200; i++ {
+		if rhandler.getRequestCount(100, 2) == 101 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rhandler.getRequestCount(100, 2) != 101 {
+		t.Errorf("got %d, want 101", rhandler.getRequestCount(100, 2))
+	}
+	return p.connections()
+}
+
+func TestMessagesAndSnapshotsCanShareMultiplexedConnection(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	if conns := testMultiplexedTransport(t, true, true, fs); conns != 1 {
+		t.Errorf("got %d connections, want 1", conns)
+	}
+}
+
+func TestMultiplexingFallsBackToSeparateConnections(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	tests := []struct {
+		senderMux   bool
+		receiverMux bool
+	}{
+		{true, false},
+		{false, true},
+	}
+	for idx, tt := range tests {
+		if conns := testMultiplexedTransport(t,
+			tt.senderMux, tt.receiverMux, fs); conns < 2 {
+			t.Errorf("%d, got %d connections, want at least 2", idx, conns)
+		}
+	}
+}
+
+func testTransportAuthToken(t *testing.T,
+	c config.NodeHostConfig, rc config.NodeHostConfig, ok bool, fs vfs.IFS) {
+	defer func() {
+		if err := fs.RemoveAll(snapshotDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	rc.RaftAddress = fmt.Sprintf("localhost:%d", getTestPort()+1)
+	rhandler := newTestMessageHandler()
+	receiver, _, rstopper, _ := newTestTransportWithConfig(rhandler, rc, fs)
+	defer func() {
+		if err := receiver.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer func() {
+		if err := receiver.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer rstopper.Stop()
+	events := &testTransportEvent{}
+	receiver.trans.(*TCP).onRejected = events.ConnectionRejected
+	c.RaftAddress = serverAddress
+	handler := newTestMessageHandler()
+	sender, nodes, stopper, tt := newTestTransportWithConfig(handler, c, fs)
+	defer func() {
+		if err := sender.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer tt.cleanup()
+	defer func() {
+		if err := sender.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer stopper.Stop()
+	nodes.Add(100, 2, rc.RaftAddress)
+	sz := uint64(snapshotChunkSize + 1)
+	tt.generateSnapshotFile(100, 12, testSnapshotIndex, "testsnapshot.gbsnap", sz, fs)
+	m := getTestSnapshotMessage(2)
+	m.Snapshot.FileSize = getTestSnapshotFileSize(sz)
+	m.Snapshot.Filepath = fs.PathJoin(tt.GetSnapshotDir(100,
+		12, testSnapshotIndex), "testsnapshot.gbsnap")
+	if err := fs.MkdirAll(receiver.chunks.dir(100, 2), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for i := 0; i < 10; i++ {
+		msg := raftpb.Message{
+			Type:    raftpb.Heartbeat,
+			To:      2,
+			ShardID: 100,
+		}
+		sender.Send(msg)
+	}
+	if !sender.SendSnapshot(m) {
+		t.Fatalf("failed to send the snapshot")
+	}
+	waitForFirstSnapshotStatusUpdate(handler, 10000)
+	if ok {
+		waitForSnapshotCountUpdate(rhandler, 10000)
+		if handler.getSnapshotSuccessCount(100, 2) != 1 {
+			t.Errorf("got %d, want 1", handler.getSnapshotSuccessCount(100, 2))
+		}
+		// heartbeats and the InstallSnapshot message
+		for i := 0; i < 200; i++ {
+			if rhandler.getRequestCount(100, 2) == 11 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if rhandler.getRequestCount(100, 2) != 11 {
+			t.Errorf("got %d, want 11", rhandler.getRequestCount(100, 2))
+		}
+		if rejected := events.getRejected(); len(rejected) != 0 {
+			t.Errorf("unexpected rejected connections %v", rejected)
+		}
+	} else {
+		if rhandler.getReceivedSnapshotCount(100, 2) != 0 {
+			t.Errorf("got %d, want 0", rhandler.getReceivedSnapshotCount(100, 2))
+		}
+		if rhandler.getRequestCount(100, 2) != 0 {
+			t.Errorf("got %d, want 0", rhandler.getRequestCount(100, 2))
+		}
+		for i := 0; i < 200; i++ {
+			if len(events.getRejected()) > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		rejected := events.getRejected()
+		if len(rejected) == 0 {
+			t.Fatalf("rejected connection not reported")
+		}
+		if !strings.HasPrefix(rejected[0], "127.0.0.1:") {
+			t.Errorf("unexpected remote address %s", rejected[0])
+		}
+	}
+}
+
+func TestTransportAuthTokenIsVerified(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	tests := []struct {
+		token   string
+		rtoken  string
+		rallow  bool
+		mux     bool
+		success bool
+	}{
+		{"secret", "secret", false, false, true},
+		{"secret", "secret", false, true, true},
+		{"secret", "", false, false, true},
+		{"", "secret", true, false, true},
+		{"other", "secret", true, false, false},
+		{"other", "secret", false, true, false},
+		{"", "secret", false, false, false},
+	}
+	for idx, tt := range tests {
+		c := config.NodeHostConfig{TransportAuthToken: tt.token}
+		c.Expert.TransportMultiplexing = tt.mux
+		rc := config.NodeHostConfig{
+			TransportAuthToken:            tt.rtoken,
+			AllowUnauthenticatedTransport: tt.rallow,
+		}
+		rc.Expert.TransportMultiplexing = tt.mux
+		testTransportAuthToken(t, c, rc, tt.success, fs)
+		if t.Failed() {
+			t.Fatalf("case %d failed", idx)
+		}
+	}
+}
+
+// slowMessageHandler is a message handler with a bounded inbound queue that
+// is slowly drained to simulate a receiver with a slow LogDB.
+type slowMessageHandler struct {
+	*testMessageHandler
+	qmu      sync.Mutex
+	queued   uint64
+	capacity uint64
+	dropped  uint64
+	stopper  *syncutil.Stopper
+}
+
+func newSlowMessageHandler(capacity uint64,
+	interval time.Duration) *slowMessageHandler {
+	h := &slowMessageHandler{
+		testMessageHandler: newTestMessageHandler(),
+		capacity:           capacity,
+		stopper:            syncutil.NewStopper(),
+	}
+	h.stopper.RunWorker(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.qmu.Lock()
+				if h.queued > 0 {
+					h.queued--
+				}
+				h.qmu.Unlock()
+			case <-h.stopper.ShouldStop():
+				return
+			}
+		}
+	})
+	return h
+}
+
+func (h *slowMessageHandler) HandleMessageBatch(reqs raftpb.MessageBatch) (uint64, uint64) {
+	h.qmu.Lock()
+	for _, req := range reqs.Requests {
+		if req.Type == raftpb.Replicate {
+			if h.queued >= h.capacity {
+				h.dropped++
+			} else {
+				h.queued++
+			}
+		}
+	}
+	h.qmu.Unlock()
+	return h.testMessageHandler.HandleMessageBatch(reqs)
+}
+
+func (h *slowMessageHandler) InboundCapacity() (uint64, uint64) {
+	h.qmu.Lock()
+	defer h.qmu.Unlock()
+	return h.capacity - h.queued, math.MaxUint64
+}
+
+func (h *slowMessageHandler) getDropped() uint64 {
+	h.qmu.Lock()
+	defer h.qmu.Unlock()
+	return h.dropped
+}
+
+func TestFlowControlPreventsInboundQueueOverflow(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	defer func() {
+		if err := fs.RemoveAll(snapshotDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	rc := config.NodeHostConfig{
+		RaftAddress: fmt.Sprintf("localhost:%d", getTestPort()+1),
+	}
+	rhandler := newSlowMessageHandler(8, 2*time.Millisecond)
+	defer rhandler.stopper.Stop()
+	receiver, _, rstopper, _ := newTestTransportWithConfig(rhandler, rc, fs)
+	defer func() {
+		if err := receiver.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer func() {
+		if err := receiver.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer rstopper.Stop()
+	c := config.NodeHostConfig{
+		RaftAddress: serverAddress,
+		Expert:      config.ExpertConfig{TransportFlowControl: true},
+	}
+	handler := newTestMessageHandler()
+	sender, nodes, stopper, _ := newTestTransportWithConfig(handler, c, fs)
+	defer func() {
+		if err := sender.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer func() {
+		if err := sender.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer stopper.Stop()
+	nodes.Add(100, 2, rc.RaftAddress)
+	count := uint64(200)
+	for i := uint64(0); i < count; i++ {
+		msg := raftpb.Message{
+			Type:    raftpb.Replicate,
+			To:      2,
+			ShardID: 100,
+			Entries: []raftpb.Entry{{Index: i + 1, Cmd: make([]byte, 64)}},
+		}
+		if !sender.Send(msg) {
+			t.Fatalf("failed to send message")
+		}
+	}
+	// heartbeats are not paused by the flow control
+	hb := raftpb.Message{Type: raftpb.Heartbeat, To: 2, ShardID: 100}
+	if !sender.Send(hb) {
+		t.Fatalf("failed to send heartbeat")
+	}
+	for i := 0; i < 1000; i++ {
+		if rhandler.getRequestCount(100, 2) == count+1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := rhandler.getRequestCount(100, 2); v != count+1 {
+		t.Fatalf("got %d, want %d", v, count+1)
+	}
+	if v := rhandler.getDropped(); v != 0 {
+		t.Errorf("%d messages dropped", v)
+	}
+	stats := sender.GetPeerStats()
+	if len(stats) != 1 {
+		t.Fatalf("unexpected stats count %d", len(stats))
+	}
+	if stats[0].PausedDuration == 0 {
+		t.Errorf("paused duration not reported")
+	}
+	if stats[0].MessagesDropped != 0 {
+		t.Errorf("unexpected dropped count %d", stats[0].MessagesDropped)
+	}
+}
+
+func TestMessageCanBeSentWithSocketOptions(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	c := config.NodeHostConfig{
+		RaftAddress: serverAddress,
+		Expert: config.ExpertConfig{
+			Socket: config.SocketConfig{
+				ReusePort:      true,
+				DisableNoDelay: true,
+				RecvBufferSize: 256 * 1024,
+				SendBufferSize: 256 * 1024,
+				AcceptBacklog:  128,
+			},
+		},
+	}
+	handler := newTestMessageHandler()
+	trans, nodes, stopper, _ := newTestTransportWithConfig(handler, c, fs)
+	defer func() {
+		if err := trans.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer func() {
+		if err := trans.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer stopper.Stop()
+	nodes.Add(100, 2, serverAddress)
+	for i := 0; i < 20; i++ {
+		msg := raftpb.Message{
+			Type:    raftpb.Heartbeat,
+			To:      2,
+			ShardID: 100,
+		}
+		if !trans.Send(msg) {
+			t.Errorf("failed to send message")
+		}
+	}
+	for i := 0; i < 200; i++ {
+		if handler.getRequestCount(100, 2) == 20 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("got %d, want 20", handler.getRequestCount(100, 2))
+}
+
+type lookupMessageHandler struct {
+	*testMessageHandler
+	replicas map[raftio.NodeInfo]struct{}
+}
+
+func (h *lookupMessageHandler) HasReplica(shardID uint64,
+	replicaID uint64) bool {
+	_, ok := h.replicas[raftio.NodeInfo{ShardID: shardID, ReplicaID: replicaID}]
+	return ok
+}
+
+func TestMessagesToUnknownReplicaAreReportedToSender(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	defer func() {
+		if err := fs.RemoveAll(snapshotDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	rc := config.NodeHostConfig{
+		RaftAddress: fmt.Sprintf("localhost:%d", getTestPort()+1),
+		Expert:      config.ExpertConfig{TransportMisdeliveryReport: true},
+	}
+	rhandler := &lookupMessageHandler{
+		testMessageHandler: newTestMessageHandler(),
+		replicas: map[raftio.NodeInfo]struct{}{
+			{ShardID: 100, ReplicaID: 2}: {},
+		},
+	}
+	receiver, _, rstopper, _ := newTestTransportWithConfig(rhandler, rc, fs)
+	defer func() {
+		if err := receiver.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer func() {
+		if err := receiver.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer rstopper.Stop()
+	c := config.NodeHostConfig{RaftAddress: serverAddress}
+	sender, nodes, stopper, _ := newTestTransportWithConfig(
+		newTestMessageHandler(), c, fs)
+	defer func() {
+		if err := sender.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer func() {
+		if err := sender.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer stopper.Stop()
+	events := &testTransportEvent{}
+	sender.sysEvents = events
+	nodes.Add(100, 2, rc.RaftAddress)
+	nodes.Add(100, 3, rc.RaftAddress)
+	count := uint64(20)
+	for i := uint64(0); i < count; i++ {
+		for _, to := range []uint64{2, 3} {
+			msg := raftpb.Message{Type: raftpb.Heartbeat, To: to, ShardID: 100}
+			if !sender.Send(msg) {
+				t.Fatalf("failed to send message")
+			}
+		}
+	}
+	for i := 0; i < 200; i++ {
+		if rhandler.getRequestCount(100, 3) == count &&
+			len(events.getMisdelivered()) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := rhandler.getRequestCount(100, 3); v != count {
+		t.Fatalf("got %d, want %d", v, count)
+	}
+	misdelivered := events.getMisdelivered()
+	if len(misdelivered) == 0 {
+		t.Fatalf("misdelivered message not reported")
+	}
+	// reports are rate limited
+	if uint64(len(misdelivered)) >= count {
+		t.Errorf("unexpected report count %d", len(misdelivered))
+	}
+	expected := raftio.MisdeliveredMessageInfo{
+		Address:   rc.RaftAddress,
+		ShardID:   100,
+		ReplicaID: 3,
+	}
+	for _, info := range misdelivered {
+		if info != expected {
+			t.Errorf("unexpected info %+v", info)
+		}
+	}
+	stats := sender.GetPeerStats()
+	if len(stats) != 1 {
+		t.Fatalf("unexpected stats count %d", len(stats))
+	}
+	if stats[0].MessagesMisdelivered != uint64(len(misdelivered)) {
+		t.Errorf("got %d, want %d",
+			stats[0].MessagesMisdelivered, len(misdelivered))
+	}
+}
+
+// slowWriteInjector is a vfs injector that slows down all writes.
+type slowWriteInjector struct{}
+
+func (slowWriteInjector) MaybeError(op vfs.Op) error {
+	if op == vfs.OpWrite {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil
+}
+
+// snapshotProgressRecorder records the number of snapshot bytes received.
+type snapshotProgressRecorder struct {
+	dummyTransportEvent
+	received uint64
+}
+
+func (r *snapshotProgressRecorder) SnapshotReceiveProgress(
+	info raftio.SnapshotProgressInfo) {
+	atomic.StoreUint64(&r.received, info.ReceivedBytes)
+}
+
+func TestSnapshotSendingIsPacedByReceiver(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	defer func() {
+		if err := fs.RemoveAll(snapshotDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	rc := config.NodeHostConfig{
+		RaftAddress: fmt.Sprintf("localhost:%d", getTestPort()+1),
+	}
+	rhandler := newTestMessageHandler()
+	receiver, _, rstopper, _ := newTestTransportWithConfig(rhandler,
+		rc, vfs.Wrap(fs, slowWriteInjector{}))
+	defer func() {
+		if err := receiver.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer func() {
+		if err := receiver.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer rstopper.Stop()
+	events := &snapshotProgressRecorder{}
+	receiver.chunks.events = events
+	if err := fs.MkdirAll(receiver.chunks.dir(100, 2), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	limit := 2 * snapshotChunkSize
+	c := config.NodeHostConfig{
+		RaftAddress: serverAddress,
+		Expert:      config.ExpertConfig{MaxUnackedSnapshotBytes: limit},
+	}
+	handler := newTestMessageHandler()
+	sender, nodes, stopper, tt := newTestTransportWithConfig(handler, c, fs)
+	defer func() {
+		if err := sender.env.Close(); err != nil {
+			t.Fatalf("failed to stop the env %v", err)
+		}
+	}()
+	defer func() {
+		if err := sender.Close(); err != nil {
+			t.Fatalf("failed to close the transport module %v", err)
+		}
+	}()
+	defer stopper.Stop()
+	nodes.Add(100, 2, rc.RaftAddress)
+	sent := uint64(0)
+	maxUnpersisted := uint64(0)
+	sender.SetPreStreamChunkSendHook(func(c raftpb.Chunk) (raftpb.Chunk, bool) {
+		sent += uint64(len(c.Data))
+		v := sent - atomic.LoadUint64(&events.received)
+		if v > atomic.LoadUint64(&maxUnpersisted) {
+			atomic.StoreUint64(&maxUnpersisted, v)
+		}
+		return c, true
+	})
+	sz := snapshotChunkSize * 8
+	tt.generateSnapshotFile(100, 12, testSnapshotIndex, "testsnapshot.gbsnap", sz, fs)
+	m := getTestSnapshotMessage(2)
+	m.Snapshot.FileSize = getTestSnapshotFileSize(sz)
+	dir := tt.GetSnapshotDir(100, 12, testSnapshotIndex)
+	m.Snapshot.Filepath = fs.PathJoin(dir, "testsnapshot.gbsnap")
+	if !sender.SendSnapshot(m) {
+		t.Fatalf("failed to send the snapshot")
+	}
+	waitForFirstSnapshotStatusUpdate(handler, 10000)
+	waitForSnapshotCountUpdate(rhandler, 10000)
+	if handler.getSnapshotSuccessCount(100, 2) != 1 {
+		t.Fatalf("snapshot not sent")
+	}
+	if rhandler.getReceivedSnapshotCount(100, 2) != 1 {
+		t.Fatalf("snapshot not received")
+	}
+	if v := atomic.LoadUint64(&maxUnpersisted); v > limit {
+		t.Errorf("%d bytes not persisted by the receiver, limit %d", v, limit)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sockopt applies the configured socket options to listeners and
+// connections of the built-in TCP transport module and the gossip service.
+package sockopt
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"github.com/lni/dragonboat/v4/config"
+)
+
+// Listen announces on the specified TCP address with the socket options
+// applied.
+func Listen(address string, c config.SocketConfig) (net.Listener, error) {
+	lc := net.ListenConfig{Control: Control(c)}
+	ln, err := lc.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if c.AcceptBacklog > 0 {
+		if err := setBacklog(ln, c.AcceptBacklog); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// ListenPacket announces on the specified UDP address with the socket options
+// applied.
+func ListenPacket(address string,
+	c config.SocketConfig) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: Control(c)}
+	return lc.ListenPacket(context.Background(), "udp", address)
+}
+
+// Control returns the function to be used as the Control field of
+// net.ListenConfig, socket options are applied before the socket is bound.
+func Control(c config.SocketConfig) func(string, string, syscall.RawConn) error {
+	return func(network string, address string, rc syscall.RawConn) error {
+		var serr error
+		if err := rc.Control(func(fd uintptr) {
+			serr = setOptions(fd, c)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// SetConn applies the per connection socket options to the specified
+// accepted or dialed connection.
+func SetConn(conn *net.TCPConn, c config.SocketConfig) error {
+	return conn.SetNoDelay(!c.DisableNoDelay)
+}
@@ -0,0 +1,68 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package sockopt
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/lni/dragonboat/v4/config"
+)
+
+func setOptions(fd uintptr, c config.SocketConfig) error {
+	if c.ReusePort {
+		if err := unix.SetsockoptInt(int(fd),
+			unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return err
+		}
+	}
+	if c.RecvBufferSize > 0 {
+		if err := unix.SetsockoptInt(int(fd),
+			unix.SOL_SOCKET, unix.SO_RCVBUF, c.RecvBufferSize); err != nil {
+			return err
+		}
+	}
+	if c.SendBufferSize > 0 {
+		if err := unix.SetsockoptInt(int(fd),
+			unix.SOL_SOCKET, unix.SO_SNDBUF, c.SendBufferSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setBacklog updates the accept backlog of the listener. Calling listen(2) on
+// a socket that is already listening only updates its backlog on Linux.
+func setBacklog(ln net.Listener, backlog int) error {
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+	rc, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = unix.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
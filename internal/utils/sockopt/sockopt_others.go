@@ -0,0 +1,36 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package sockopt
+
+import (
+	"net"
+
+	"github.com/lni/dragonboat/v4/config"
+)
+
+// setOptions is a no-op as socket options are not supported on this
+// platform.
+func setOptions(fd uintptr, c config.SocketConfig) error {
+	return nil
+}
+
+// setBacklog is a no-op as the accept backlog can not be configured on this
+// platform.
+func setBacklog(ln net.Listener, backlog int) error {
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sockopt
+
+import (
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+)
+
+func TestListenersCanShareThePortWithReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on Linux")
+	}
+	c := config.SocketConfig{ReusePort: true, AcceptBacklog: 64}
+	ln1, err := Listen("127.0.0.1:0", c)
+	if err != nil {
+		t.Fatalf("failed to listen %v", err)
+	}
+	defer ln1.Close()
+	ln2, err := Listen(ln1.Addr().String(), c)
+	if err != nil {
+		t.Fatalf("failed to listen on the same port %v", err)
+	}
+	defer ln2.Close()
+	var accepted [2]uint64
+	for idx, ln := range []net.Listener{ln1, ln2} {
+		i, l := idx, ln
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				atomic.AddUint64(&accepted[i], 1)
+				conn.Close()
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		conn, err := net.Dial("tcp", ln1.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect %v", err)
+		}
+		conn.Close()
+		if atomic.LoadUint64(&accepted[0]) > 0 &&
+			atomic.LoadUint64(&accepted[1]) > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("connections not received by both listeners, %d, %d",
+		atomic.LoadUint64(&accepted[0]), atomic.LoadUint64(&accepted[1]))
+}
+
+func TestListenWithoutReusePortFailsOnUsedPort(t *testing.T) {
+	ln1, err := Listen("127.0.0.1:0", config.SocketConfig{})
+	if err != nil {
+		t.Fatalf("failed to listen %v", err)
+	}
+	defer ln1.Close()
+	ln2, err := Listen(ln1.Addr().String(), config.SocketConfig{})
+	if err == nil {
+		ln2.Close()
+		t.Fatalf("port unexpectedly shared")
+	}
+}
@@ -52,3 +52,8 @@ func OnIndex(index int32, op Op) *InjectIndex {
 func Wrap(fs IFS, inj Injector) *ErrorFS {
 	return gvfs.Wrap(fs, inj)
 }
+
+// WrapFile wraps an existing File with the specified injector.
+func WrapFile(f File, inj Injector) File {
+	return gvfs.WrapFile(f, inj)
+}
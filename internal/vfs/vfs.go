@@ -41,6 +41,9 @@ var MemStrictFS IFS = gvfs.NewStrictMem()
 // File is the file interface returned by IFS.
 type File = gvfs.File
 
+// OpenOption is the option applied to files opened by IFS.
+type OpenOption = gvfs.OpenOption
+
 // NewMemFS creates a in-memory fs.
 func NewMemFS() IFS {
 	return gvfs.NewStrictMem()
@@ -174,6 +177,17 @@ func IsExist(err error) bool {
 	return oserror.IsExist(err)
 }
 
+// Copy copies the contents of the file oldname to the new file newname.
+func Copy(fs IFS, oldname string, newname string) error {
+	return gvfs.Copy(fs, oldname, newname)
+}
+
+// LinkOrCopy creates newname as a hard link to the file oldname, the file is
+// copied when hard links are not supported.
+func LinkOrCopy(fs IFS, oldname string, newname string) error {
+	return gvfs.LinkOrCopy(fs, oldname, newname)
+}
+
 // TempDir returns the directory use for storing temporary files.
 func TempDir() string {
 	return os.TempDir()
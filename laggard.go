@@ -0,0 +1,150 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/lni/dragonboat/v4/internal/server"
+)
+
+// laggardState describes the followers affecting the compaction of the
+// leader's log, it is reported by ExplainCompaction.
+type laggardState struct {
+	// replicaID is the ID of the follower for which compaction is held back.
+	replicaID uint64
+	dead      bool
+	// remaining is the number of ticks before the grace of the follower
+	// expires.
+	remaining uint64
+	// cutOff are followers whose grace has expired.
+	cutOff []uint64
+}
+
+// laggardTracker tracks followers holding back the compaction of the leader's
+// log as specified by config.Config.CompactionLaggardGraceTicks. Other than
+// the reported state, it is only accessed by the step worker.
+type laggardTracker struct {
+	// since is the tick since when each follower has been holding back
+	// compaction.
+	since map[uint64]uint64
+	// deferred is the index the log is to be compacted to once compaction is
+	// no longer held back, it is 0 when compaction is not deferred.
+	deferred uint64
+	mu       sync.Mutex
+	state    laggardState
+}
+
+func (t *laggardTracker) setState(s laggardState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.state = s
+}
+
+func (t *laggardTracker) getState() laggardState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+func (t *laggardTracker) reset() {
+	t.since = nil
+	t.deferred = 0
+	t.setState(laggardState{})
+}
+
+// holdCompaction returns the index up to which the log can be compacted now
+// when it is requested to be compacted up to compactTo. Compaction is not
+// allowed to advance past the match index of a lagging follower until its
+// grace expires, the remaining part is deferred and retried on later ticks. 0
+// is returned when nothing can be compacted now.
+func (n *node) holdCompaction(compactTo uint64) uint64 {
+	t := &n.laggards
+	if t.deferred > compactTo {
+		compactTo = t.deferred
+	}
+	t.deferred = 0
+	if compactTo == 0 || n.config.CompactionLaggardGraceTicks == 0 {
+		return compactTo
+	}
+	n.raftMu.Lock()
+	st := n.p.GetStatus()
+	n.raftMu.Unlock()
+	if st.LeaderID != n.replicaID {
+		t.reset()
+		return compactTo
+	}
+	limit, state := n.getLaggardCompactionLimit(st, compactTo)
+	t.setState(state)
+	if limit < compactTo {
+		t.deferred = compactTo
+		plog.Debugf("%s compaction held back at %d for replica %d",
+			n.id(), limit, state.replicaID)
+	}
+	if st.FirstIndex > 0 && limit < st.FirstIndex {
+		// entries up to limit have already been compacted
+		return 0
+	}
+	return limit
+}
+
+func (n *node) getLaggardCompactionLimit(st server.RaftStatus,
+	compactTo uint64) (uint64, laggardState) {
+	t := &n.laggards
+	since := make(map[uint64]uint64)
+	state := laggardState{}
+	limit := compactTo
+	for _, r := range st.Remotes {
+		if r.Match >= compactTo || n.isWitnessReplica(r.ReplicaID) {
+			continue
+		}
+		start, ok := t.since[r.ReplicaID]
+		if !ok {
+			start = st.TickCount
+		}
+		since[r.ReplicaID] = start
+		dead := r.LastActive == 0 ||
+			st.TickCount-r.LastActive > n.config.ElectionRTT
+		grace := n.config.CompactionLaggardGraceTicks
+		if dead {
+			grace = n.config.CompactionDeadFollowerGraceTicks
+		}
+		elapsed := st.TickCount - start
+		if elapsed >= grace {
+			state.cutOff = append(state.cutOff, r.ReplicaID)
+			continue
+		}
+		if r.Match < limit {
+			limit = r.Match
+			state.replicaID = r.ReplicaID
+			state.dead = dead
+			state.remaining = grace - elapsed
+		}
+	}
+	sort.Slice(state.cutOff, func(i, j int) bool {
+		return state.cutOff[i] < state.cutOff[j]
+	})
+	t.since = since
+	return limit, state
+}
+
+// retryDeferredCompaction makes the deferred compaction to be evaluated again.
+// It is invoked on each tick.
+func (n *node) retryDeferredCompaction() {
+	if n.laggards.deferred > 0 {
+		n.ss.retryCompactLogTo(n.laggards.deferred)
+	}
+}
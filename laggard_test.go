@@ -0,0 +1,298 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// startLaggardTestShard starts a three replicas shard with the specified
+// grace ticks and returns the index of the NodeHost of the leader.
+func startLaggardTestShard(t *testing.T,
+	nhs []*NodeHost, grace uint64, deadGrace uint64) int {
+	peers := make(map[uint64]string)
+	for i := range nhs {
+		peers[uint64(i+1)] = memtransport.Address(i + 1)
+	}
+	for i, nh := range nhs {
+		rc := config.Config{
+			ShardID:                          1,
+			ReplicaID:                        uint64(i + 1),
+			ElectionRTT:                      10,
+			HeartbeatRTT:                     1,
+			CheckQuorum:                      true,
+			CompactionLaggardGraceTicks:      grace,
+			CompactionDeadFollowerGraceTicks: deadGrace,
+		}
+		createSM := func(uint64, uint64) sm.IStateMachine {
+			return &PST{}
+		}
+		if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+	}
+	for _, nh := range nhs {
+		waitForLeaderToBeElected(t, nh, 1)
+	}
+	leaderID, _, _, err := nhs[0].GetLeaderID(1)
+	if err != nil {
+		t.Fatalf("failed to get leader id %v", err)
+	}
+	return int(leaderID - 1)
+}
+
+// partitionLaggard partitions the first follower away from other replicas,
+// makes proposals and requests a snapshot on the leader. The index of the
+// NodeHost of the partitioned follower and the snapshot index are returned.
+func partitionLaggard(t *testing.T, network *memtransport.Network,
+	nhs []*NodeHost, leader int) (int, uint64) {
+	laggard := (leader + 1) % len(nhs)
+	var others []string
+	for i := range nhs {
+		if i != laggard {
+			others = append(others, memtransport.Address(i+1))
+		}
+	}
+	network.Partition([]string{memtransport.Address(laggard + 1)}, others)
+	for i := 0; i < 20; i++ {
+		if !makeTestProposal(nhs[leader], 100) {
+			t.Fatalf("failed to make proposal")
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[leader]))
+	defer cancel()
+	opt := SnapshotOption{OverrideCompactionOverhead: true}
+	index, err := nhs[leader].SyncRequestSnapshot(ctx, 1, opt)
+	if err != nil {
+		t.Fatalf("failed to request snapshot %v", err)
+	}
+	return laggard, index
+}
+
+func waitForLaggardSnapshot(t *testing.T, nh *NodeHost, replicaID uint64,
+	f func(index uint64) bool) uint64 {
+	for i := 0; i < 200; i++ {
+		ss, err := nh.mu.logdb.GetSnapshot(1, replicaID)
+		if err != nil {
+			t.Fatalf("failed to get snapshot %v", err)
+		}
+		if f(ss.Index) {
+			return ss.Index
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("unexpected snapshot state of replica %d", replicaID)
+	return 0
+}
+
+func TestBrieflyDownFollowerCatchesUpWithoutSnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		leader := startLaggardTestShard(t, nhs, 100000, 100000)
+		laggard, index := partitionLaggard(t, network, nhs, leader)
+		laggardID := uint64(laggard + 1)
+		r := waitForCompactionReason(t, nhs[leader], CompactionDeadFollower)
+		if r.LaggardReplicaID != laggardID || r.LaggardGraceTicks == 0 {
+			t.Errorf("unexpected report %+v", r)
+		}
+		if r.FirstIndex >= index {
+			t.Errorf("log compacted, first index %d, snapshot index %d",
+				r.FirstIndex, index)
+		}
+		network.Heal()
+		// compaction proceeds once the follower caught up
+		for i := 0; ; i++ {
+			r := explainTestCompaction(t, nhs[leader])
+			if r.FirstIndex > index && r.LaggardReplicaID == 0 {
+				break
+			}
+			if i > 500 {
+				t.Fatalf("log not compacted, %+v", r)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		waitForLaggardSnapshot(t, nhs[laggard], laggardID, func(v uint64) bool {
+			return v == 0
+		})
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
+
+func TestFollowerDownPastGraceIsCaughtUpBySnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		leader := startLaggardTestShard(t, nhs, 100000, 20)
+		laggard, index := partitionLaggard(t, network, nhs, leader)
+		laggardID := uint64(laggard + 1)
+		for i := 0; ; i++ {
+			r := explainTestCompaction(t, nhs[leader])
+			if r.FirstIndex > index {
+				if len(r.CutOffReplicaIDs) != 1 ||
+					r.CutOffReplicaIDs[0] != laggardID || r.LaggardReplicaID != 0 {
+					t.Errorf("unexpected report %+v", r)
+				}
+				break
+			}
+			if i > 500 {
+				t.Fatalf("log not compacted, %+v", r)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		network.Heal()
+		waitForLaggardSnapshot(t, nhs[laggard], laggardID, func(v uint64) bool {
+			return v >= index
+		})
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
+
+// getLaggardCatchUpBytes partitions a follower away, makes it lag 1k entries
+// behind the compaction point of the leader and returns the number of bytes
+// sent by the leader to bring it up to date, the size of the snapshot image is
+// counted when the follower is caught up by a snapshot. The returned boolean
+// value indicates whether a snapshot was sent.
+func getLaggardCatchUpBytes(t *testing.T, retain bool) (uint64, bool) {
+	const lag = 1000
+	const snapshotSize = 1024 * 1024
+	caughtUpBytes := uint64(0)
+	snapshot := false
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		peers := make(map[uint64]string)
+		for i := range nhs {
+			peers[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		for i, nh := range nhs {
+			rc := config.Config{
+				ShardID:      1,
+				ReplicaID:    uint64(i + 1),
+				ElectionRTT:  10,
+				HeartbeatRTT: 1,
+				CheckQuorum:  true,
+				PreVote:      true,
+			}
+			if retain {
+				rc.CompactedEntriesRetentionTicks = 100000
+				rc.MaxEntriesOverSnapshot = 2 * lag
+			}
+			createSM := func(uint64, uint64) sm.IStateMachine {
+				return &largeSnapshotSM{size: snapshotSize}
+			}
+			if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+				t.Fatalf("failed to start replica %v", err)
+			}
+		}
+		for _, nh := range nhs {
+			waitForLeaderToBeElected(t, nh, 1)
+		}
+		leaderID, _, _, err := nhs[0].GetLeaderID(1)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		leader := int(leaderID - 1)
+		laggard := (leader + 1) % len(nhs)
+		laggardAddr := memtransport.Address(laggard + 1)
+		var others []string
+		for i := range nhs {
+			if i != laggard {
+				others = append(others, memtransport.Address(i+1))
+			}
+		}
+		network.Partition([]string{laggardAddr}, others)
+		session := nhs[leader].GetNoOPSession(1)
+		for i := 0; i < lag; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[leader]))
+			_, err := nhs[leader].SyncPropose(ctx, session, make([]byte, 64))
+			cancel()
+			if err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[leader]))
+		opt := SnapshotOption{OverrideCompactionOverhead: true}
+		index, err := nhs[leader].SyncRequestSnapshot(ctx, 1, opt)
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to request snapshot %v", err)
+		}
+		for i := 0; explainTestCompaction(t, nhs[leader]).FirstIndex <= index; i++ {
+			if i > 500 {
+				t.Fatalf("log not compacted")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		sent := func() uint64 {
+			for _, ps := range nhs[leader].GetTransportStats() {
+				if ps.Address == laggardAddr {
+					return ps.BytesSent
+				}
+			}
+			return 0
+		}
+		start := sent()
+		network.Heal()
+		expected, err := nhs[leader].StaleRead(1, nil)
+		if err != nil {
+			t.Fatalf("failed to read %v", err)
+		}
+		for i := 0; ; i++ {
+			v, err := nhs[laggard].StaleRead(1, nil)
+			if err != nil {
+				t.Fatalf("failed to read %v", err)
+			}
+			if v.(uint64) == expected.(uint64) {
+				break
+			}
+			if i > 1000 {
+				t.Fatalf("follower not caught up, %d vs %d", v, expected)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		caughtUpBytes = sent() - start
+		ss, err := nhs[laggard].mu.logdb.GetSnapshot(1, uint64(laggard+1))
+		if err != nil {
+			t.Fatalf("failed to get snapshot %v", err)
+		}
+		if ss.Index >= index {
+			snapshot = true
+			caughtUpBytes += ss.FileSize
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+	return caughtUpBytes, snapshot
+}
+
+func TestRetainedEntriesReduceCatchUpBytes(t *testing.T) {
+	before, snapshot := getLaggardCatchUpBytes(t, false)
+	if !snapshot {
+		t.Fatalf("follower not caught up by snapshot")
+	}
+	after, snapshot := getLaggardCatchUpBytes(t, true)
+	if snapshot {
+		t.Fatalf("follower caught up by snapshot")
+	}
+	if after >= before {
+		t.Errorf("retained entries transferred %d bytes, snapshot %d bytes",
+			after, before)
+	}
+	t.Logf("catch up bytes, snapshot: %d, retained entries: %d", before, after)
+}
@@ -0,0 +1,58 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync/atomic"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// canStep returns a boolean value indicating whether the replica can
+// participate in Raft. Replicas with LazyReplay enabled participate in Raft
+// while their state machines are still being recovered from the snapshot.
+func (n *node) canStep() bool {
+	return n.initialized() || n.config.LazyReplay
+}
+
+// ready returns a boolean value indicating whether the replica is ready to
+// handle requests. Replicas with LazyReplay enabled are only ready after all
+// entries committed before the restart have been applied.
+func (n *node) ready() bool {
+	if !n.initialized() {
+		return false
+	}
+	if !n.config.LazyReplay || atomic.LoadUint32(&n.replayedFlag) != 0 {
+		return true
+	}
+	if n.sm.GetLastApplied() < n.replayedIndex {
+		return false
+	}
+	atomic.StoreUint32(&n.replayedFlag, 1)
+	return true
+}
+
+// dropSnapshotWhenUninitialized returns a boolean value indicating whether
+// the received InstallSnapshot message should be dropped as the replica is
+// still being recovered from its local snapshot. The leader sends the
+// snapshot again once the replica rejects its Replicate messages.
+func (n *node) dropSnapshotWhenUninitialized(m pb.Message) bool {
+	if m.Type != pb.InstallSnapshot || n.initialized() {
+		return false
+	}
+	plog.Warningf("%s dropped snapshot %d from %d, not initialized",
+		n.id(), m.Snapshot.Index, m.From)
+	return true
+}
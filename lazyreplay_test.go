@@ -0,0 +1,186 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/tests"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// replayTestSM is a state machine counting applied entries, its
+// RecoverFromSnapshot method waits until the recovered channel is closed when
+// recovered is set and takes at least delay to complete.
+type replayTestSM struct {
+	recovered chan struct{}
+	delay     time.Duration
+	count     uint64
+}
+
+func (s *replayTestSM) Update(e sm.Entry) (sm.Result, error) {
+	s.count++
+	return sm.Result{Value: s.count}, nil
+}
+
+func (s *replayTestSM) Lookup(query interface{}) (interface{}, error) {
+	return s.count, nil
+}
+
+func (s *replayTestSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, s.count)
+	_, err := w.Write(data)
+	return err
+}
+
+func (s *replayTestSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	if s.recovered != nil {
+		select {
+		case <-s.recovered:
+		case <-done:
+			return sm.ErrSnapshotStopped
+		}
+	}
+	time.Sleep(s.delay)
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.count = binary.LittleEndian.Uint64(data)
+	return nil
+}
+
+func (s *replayTestSM) Close() error { return nil }
+
+func makeReplayTestProposals(t *testing.T, nh *NodeHost, count int) {
+	session := nh.GetNoOPSession(1)
+	for i := 0; i < count; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+		_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to make proposal, %v", err)
+		}
+	}
+}
+
+func testLazyReplay(t *testing.T, lazy bool) {
+	fs := vfs.GetTestFS()
+	var recovered chan struct{}
+	to := &testOption{
+		updateConfig: func(c *config.Config) *config.Config {
+			c.LazyReplay = lazy
+			return c
+		},
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &replayTestSM{recovered: recovered}
+		},
+		tf: func(nh *NodeHost) {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			makeReplayTestProposals(t, nh, 10)
+			if _, err := nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption); err != nil {
+				t.Fatalf("failed to request snapshot, %v", err)
+			}
+			makeReplayTestProposals(t, nh, 10)
+			recovered = make(chan struct{})
+		},
+		rf: func(nh *NodeHost) {
+			released := false
+			release := func() {
+				if !released {
+					released = true
+					close(recovered)
+				}
+			}
+			defer release()
+			// the replica participates in raft before it is recovered from the
+			// snapshot when LazyReplay is enabled
+			time.Sleep(20 * pto(nh) / 10)
+			_, _, ok, err := nh.GetLeaderID(1)
+			if err != nil {
+				t.Fatalf("failed to get leader id, %v", err)
+			}
+			if ok != lazy {
+				t.Fatalf("leader available %t, lazy replay %t", ok, lazy)
+			}
+			session := nh.GetNoOPSession(1)
+			if _, err := nh.Propose(session, []byte("test-data"), pto(nh)); err != ErrShardNotReady {
+				t.Errorf("failed to reject proposal, %v", err)
+			}
+			if _, err := nh.ReadIndex(1, pto(nh)); err != ErrShardNotReady {
+				t.Errorf("failed to reject read, %v", err)
+			}
+			release()
+			waitForLeaderToBeElected(t, nh, 1)
+			for i := 0; i < 100; i++ {
+				if makeTestProposal(nh, 1) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			v, err := nh.SyncRead(ctx, 1, nil)
+			if err != nil {
+				t.Fatalf("failed to read, %v", err)
+			}
+			// all proposals made before the restart have been applied
+			if count := v.(uint64); count < 21 {
+				t.Errorf("count %d, want >= 21", count)
+			}
+		},
+		restartNodeHost: true,
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestLazyReplayReplicaParticipatesInRaftBeforeReplayed(t *testing.T) {
+	testLazyReplay(t, true)
+}
+
+func TestReplicaWaitsForRecoveryBeforeParticipatingInRaft(t *testing.T) {
+	testLazyReplay(t, false)
+}
+
+func TestLazyReplayIsNotSupportedByOnDiskStateMachine(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		tf: func(nh *NodeHost) {
+			cfg := getTestConfig()
+			cfg.ShardID = 2
+			cfg.LazyReplay = true
+			peers := map[uint64]string{1: nh.RaftAddress()}
+			create := func(uint64, uint64) sm.IOnDiskStateMachine {
+				return tests.NewFakeDiskSM(0)
+			}
+			err := nh.StartOnDiskReplica(peers, false, create, *cfg)
+			if err != ErrInvalidShardSettings {
+				t.Errorf("unexpected error %v", err)
+			}
+		},
+		defaultTestNode: true,
+	}
+	runNodeHostTest(t, to, fs)
+}
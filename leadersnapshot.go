@@ -0,0 +1,505 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/lni/goutils/random"
+
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+var (
+	// ErrNotLeader indicates that the local replica is not the leader. The
+	// returned error is a *NotLeaderError when the leader is known.
+	ErrNotLeader = errors.New("not the leader")
+	// ErrLeaderChanged indicates that the leadership changed before the
+	// operation requiring the leadership completed.
+	ErrLeaderChanged = errors.New("leader changed")
+)
+
+// NotLeaderError is the error returned when an operation can only be
+// performed on the leader but the local replica is not the leader. LeaderID
+// is 0 when the leader is unknown.
+type NotLeaderError struct {
+	ShardID       uint64
+	LeaderID      uint64
+	Term          uint64
+	LeaderAddress string
+}
+
+func (e *NotLeaderError) Error() string {
+	return fmt.Sprintf("%s, shard %d, leader %d, term %d, address %s",
+		ErrNotLeader, e.ShardID, e.LeaderID, e.Term, e.LeaderAddress)
+}
+
+// Unwrap returns ErrNotLeader.
+func (e *NotLeaderError) Unwrap() error {
+	return ErrNotLeader
+}
+
+// LeaderChangedError is the error returned when a leader only snapshot is
+// aborted because the leader lost its leadership in Term before the snapshot
+// was committed.
+type LeaderChangedError struct {
+	ShardID uint64
+	Term    uint64
+}
+
+func (e *LeaderChangedError) Error() string {
+	return fmt.Sprintf("%s, shard %d, term %d", ErrLeaderChanged, e.ShardID, e.Term)
+}
+
+// Unwrap returns ErrLeaderChanged.
+func (e *LeaderChangedError) Unwrap() error {
+	return ErrLeaderChanged
+}
+
+// ExportResult is the result of an exported snapshot returned by
+// SyncExportSnapshot.
+type ExportResult struct {
+	// Index is the index of the exported snapshot.
+	Index uint64
+	// ReplicaID is the ID of the replica that exported the snapshot.
+	ReplicaID uint64
+	// Locator is the path of the exported snapshot directory on the host of the
+	// replica that exported the snapshot. It is empty when the snapshot was
+	// exported to an ExportSink.
+	Locator string
+	// PreviousIndex is the index of the snapshot previously exported by the
+	// same replica, it is 0 when there is no such snapshot. It allows exported
+	// snapshots to be chained.
+	PreviousIndex uint64
+}
+
+// SyncExportSnapshot exports a snapshot of the specified shard and returns
+// once the snapshot is exported. It is the same as SyncRequestSnapshot with
+// opt.Exported set, but the returned ExportResult also describes which replica
+// exported the snapshot and where it is. This is useful when opt.LeaderOnly
+// is set as the snapshot can be exported by the leader on another NodeHost.
+//
+// The input context object must have deadline set.
+func (nh *NodeHost) SyncExportSnapshot(ctx context.Context,
+	shardID uint64, opt SnapshotOption) (_ ExportResult, err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation:  "SyncExportSnapshot",
+		ShardID:    shardID,
+		Parameters: auditParams{"Option": opt},
+	}, time.Now(), &err)
+	opt.Exported = true
+	result, _, err := nh.exportSnapshot(ctx, shardID, opt)
+	return result, err
+}
+
+// exportSnapshot exports the snapshot and returns both the ExportResult and
+// the metadata of the exported snapshot.
+func (nh *NodeHost) exportSnapshot(ctx context.Context,
+	shardID uint64, opt SnapshotOption) (ExportResult, SnapshotResult, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ExportResult{}, SnapshotResult{}, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return ExportResult{}, SnapshotResult{}, ErrShardNotFound
+	}
+	if err := opt.Validate(); err != nil {
+		return ExportResult{}, SnapshotResult{}, err
+	}
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return ExportResult{}, SnapshotResult{}, err
+	}
+	if !opt.LeaderOnly {
+		return nh.doExport(ctx, n, opt, timeout)
+	}
+	if leaderID, _, ok := n.getLeaderID(); ok && leaderID == n.replicaID {
+		return nh.exportOnLeader(ctx, n, opt)
+	}
+	if opt.NoForwarding || opt.ExportSink != nil {
+		return ExportResult{}, SnapshotResult{}, n.notLeaderError()
+	}
+	if leaderID, _, ok := n.getLeaderID(); ok &&
+		!n.peerSupports(leaderID, pb.ProtocolVersion) {
+		// leaders running older versions of dragonboat can't handle forwarded
+		// exports
+		return ExportResult{}, SnapshotResult{}, n.notLeaderError()
+	}
+	return nh.forwardExport(ctx, n, opt, timeout)
+}
+
+// exportOnLeader exports the snapshot on the local replica which is expected
+// to be the leader. Concurrent leader only exports of the same shard share a
+// single export, the last export is reused when the state machine has not
+// been updated since.
+func (nh *NodeHost) exportOnLeader(ctx context.Context,
+	n *node, opt SnapshotOption) (ExportResult, SnapshotResult, error) {
+	if opt.SkipIfUnchanged {
+		if err := n.checkExportUnchanged(); err != nil {
+			return ExportResult{}, SnapshotResult{}, err
+		}
+		// shared exports are not skipped on behalf of other requests
+		opt.SkipIfUnchanged = false
+	}
+	le := &n.leaderExport
+	shared := opt.ExportSink == nil
+	le.mu.Lock()
+	if shared && le.inflight != nil {
+		op := le.inflight
+		le.mu.Unlock()
+		select {
+		case <-op.doneC:
+			return op.result, deduplicated(op.snapshot), op.err
+		case <-ctx.Done():
+			return ExportResult{}, SnapshotResult{}, getContextError(ctx)
+		}
+	}
+	if shared && le.last.Index > 0 &&
+		le.last.Index == n.sm.GetLastApplied() && n.isLeader() {
+		result, ss := le.last, le.lastSnapshot
+		le.mu.Unlock()
+		return result, deduplicated(ss), nil
+	}
+	op := &leaderExportOp{doneC: make(chan struct{})}
+	if shared {
+		le.inflight = op
+	}
+	le.mu.Unlock()
+	op.result, op.snapshot, op.err = nh.doExportOnLeader(ctx, n, opt)
+	if shared {
+		le.mu.Lock()
+		le.inflight = nil
+		if op.err == nil {
+			le.last, le.lastSnapshot = op.result, op.snapshot
+		}
+		le.mu.Unlock()
+	}
+	close(op.doneC)
+	return op.result, op.snapshot, op.err
+}
+
+func (nh *NodeHost) doExportOnLeader(ctx context.Context,
+	n *node, opt SnapshotOption) (ExportResult, SnapshotResult, error) {
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return ExportResult{}, SnapshotResult{}, err
+	}
+	return nh.doExport(ctx, n, opt, timeout)
+}
+
+// doExport exports the snapshot on the local replica.
+func (nh *NodeHost) doExport(ctx context.Context, n *node,
+	opt SnapshotOption, timeout time.Duration) (ExportResult, SnapshotResult, error) {
+	prev, err := n.getLastExportIndex()
+	if err != nil {
+		return ExportResult{}, SnapshotResult{}, err
+	}
+	rs, err := nh.requestSnapshot(n.shardID, opt, timeout)
+	if err != nil {
+		return ExportResult{}, SnapshotResult{}, err
+	}
+	r, err := getRequestResult(ctx, rs)
+	if err != nil {
+		return ExportResult{}, SnapshotResult{}, err
+	}
+	result := n.getExportResult(opt, r.SnapshotIndex())
+	result.PreviousIndex = prev
+	return result, r.GetSnapshotResult(), nil
+}
+
+// deduplicated returns the metadata of an export shared with another request.
+func deduplicated(ss SnapshotResult) SnapshotResult {
+	if ss.Index > 0 {
+		ss.Deduplicated = true
+	}
+	return ss
+}
+
+// forwardExport forwards the leader only export request to the leader and
+// waits for its result.
+func (nh *NodeHost) forwardExport(ctx context.Context, n *node,
+	opt SnapshotOption, timeout time.Duration) (ExportResult, SnapshotResult, error) {
+	leaderID, term, ok := n.getLeaderID()
+	if !ok {
+		return ExportResult{}, SnapshotResult{}, n.notLeaderError()
+	}
+	key, respC := nh.forwards.add()
+	defer nh.forwards.remove(key)
+	var flags uint64
+	if opt.SkipIfUnchanged {
+		flags |= forwardSkipIfUnchanged
+	}
+	nh.sendMessage(pb.Message{
+		Type:     pb.SnapshotForward,
+		ShardID:  n.shardID,
+		From:     n.replicaID,
+		To:       leaderID,
+		Hint:     key,
+		HintHigh: uint64(timeout.Milliseconds()),
+		LogTerm:  term,
+		Commit:   flags,
+		Snapshot: pb.Snapshot{Filepath: opt.ExportPath},
+	})
+	select {
+	case m := <-respC:
+		return getForwardedExportResult(n.shardID, m)
+	case <-ctx.Done():
+		return ExportResult{}, SnapshotResult{}, getContextError(ctx)
+	case <-n.stopC:
+		return ExportResult{}, SnapshotResult{}, ErrShardClosed
+	}
+}
+
+// handleSnapshotForward exports the snapshot requested by a follower and
+// sends the result back to the follower.
+func (nh *NodeHost) handleSnapshotForward(n *node, m pb.Message) {
+	nh.stopper.RunWorker(func() {
+		timeout := time.Duration(m.HintHigh) * time.Millisecond
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		opt := SnapshotOption{
+			Exported:        true,
+			ExportPath:      m.Snapshot.Filepath,
+			LeaderOnly:      true,
+			SkipIfUnchanged: m.Commit&forwardSkipIfUnchanged != 0,
+		}
+		var result ExportResult
+		var ss SnapshotResult
+		var err error
+		if !n.isLeader() {
+			err = n.notLeaderError()
+		} else {
+			result, ss, err = nh.exportOnLeader(ctx, n, opt)
+		}
+		resp := pb.Message{
+			Type:     pb.SnapshotForwardResp,
+			ShardID:  n.shardID,
+			From:     n.replicaID,
+			To:       m.From,
+			Hint:     m.Hint,
+			HintHigh: result.PreviousIndex,
+			LogIndex: result.Index,
+			LogTerm:  ss.Term,
+			Snapshot: pb.Snapshot{Filepath: result.Locator},
+		}
+		if ss.Deduplicated {
+			resp.Commit = forwardDeduplicated
+		}
+		if err != nil {
+			resp.Reject = true
+			resp.Commit = uint64(getForwardCode(err))
+			var nle *NotLeaderError
+			var lce *LeaderChangedError
+			var sue *SnapshotUnchangedError
+			if errors.As(err, &nle) {
+				resp.HintHigh, resp.LogTerm = nle.LeaderID, nle.Term
+			} else if errors.As(err, &lce) {
+				resp.LogTerm = lce.Term
+			} else if errors.As(err, &sue) {
+				resp.LogIndex = sue.Index
+			}
+		}
+		nh.sendMessage(resp)
+	})
+}
+
+// forwardSkipIfUnchanged is the flag carried in the Commit field of the
+// forwarded request when SkipIfUnchanged is set.
+const forwardSkipIfUnchanged uint64 = 1
+
+// forwardDeduplicated is the flag carried in the Commit field of the
+// successful response when the export was shared with another request.
+const forwardDeduplicated uint64 = 1
+
+// forwardCode is the outcome of a forwarded request carried in the Commit
+// field of the response message.
+type forwardCode uint64
+
+const (
+	forwardFailed forwardCode = iota
+	forwardNotLeader
+	forwardLeaderChanged
+	forwardTimeout
+	forwardBusy
+	forwardAborted
+	forwardUnchanged
+)
+
+func getForwardCode(err error) forwardCode {
+	switch {
+	case errors.Is(err, ErrNotLeader):
+		return forwardNotLeader
+	case errors.Is(err, ErrLeaderChanged):
+		return forwardLeaderChanged
+	case errors.Is(err, ErrTimeout):
+		return forwardTimeout
+	case errors.Is(err, ErrSystemBusy):
+		return forwardBusy
+	case errors.Is(err, ErrAborted):
+		return forwardAborted
+	case errors.Is(err, ErrSnapshotUnchanged):
+		return forwardUnchanged
+	}
+	return forwardFailed
+}
+
+func getForwardedExportResult(shardID uint64,
+	m pb.Message) (ExportResult, SnapshotResult, error) {
+	if !m.Reject {
+		result := ExportResult{
+			Index:         m.LogIndex,
+			ReplicaID:     m.From,
+			Locator:       m.Snapshot.Filepath,
+			PreviousIndex: m.HintHigh,
+		}
+		ss := SnapshotResult{
+			Index:        m.LogIndex,
+			Term:         m.LogTerm,
+			Deduplicated: m.Commit&forwardDeduplicated != 0,
+			Locator:      m.Snapshot.Filepath,
+		}
+		return result, ss, nil
+	}
+	switch forwardCode(m.Commit) {
+	case forwardNotLeader:
+		return ExportResult{}, SnapshotResult{}, &NotLeaderError{
+			ShardID:  shardID,
+			LeaderID: m.HintHigh,
+			Term:     m.LogTerm,
+		}
+	case forwardLeaderChanged:
+		return ExportResult{}, SnapshotResult{}, &LeaderChangedError{ShardID: shardID, Term: m.LogTerm}
+	case forwardTimeout:
+		return ExportResult{}, SnapshotResult{}, ErrTimeout
+	case forwardBusy:
+		return ExportResult{}, SnapshotResult{}, ErrSystemBusy
+	case forwardAborted:
+		return ExportResult{}, SnapshotResult{}, ErrAborted
+	case forwardUnchanged:
+		return ExportResult{}, SnapshotResult{}, &SnapshotUnchangedError{
+			ShardID: shardID,
+			Index:   m.LogIndex,
+		}
+	}
+	return ExportResult{}, SnapshotResult{}, ErrRejected
+}
+
+// snapshotForwards tracks export requests forwarded to leaders that are
+// waiting for responses.
+type snapshotForwards struct {
+	mu      sync.Mutex
+	pending map[uint64]chan pb.Message
+}
+
+func (f *snapshotForwards) add() (uint64, chan pb.Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pending == nil {
+		f.pending = make(map[uint64]chan pb.Message)
+	}
+	key := random.LockGuardedRand.Uint64()
+	for _, ok := f.pending[key]; ok; _, ok = f.pending[key] {
+		key = random.LockGuardedRand.Uint64()
+	}
+	respC := make(chan pb.Message, 1)
+	f.pending[key] = respC
+	return key, respC
+}
+
+func (f *snapshotForwards) remove(key uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.pending, key)
+}
+
+func (f *snapshotForwards) deliver(m pb.Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if respC, ok := f.pending[m.Hint]; ok {
+		select {
+		case respC <- m:
+		default:
+		}
+	}
+}
+
+// leaderExport is the state of leader only exports of a replica.
+type leaderExport struct {
+	mu           sync.Mutex
+	inflight     *leaderExportOp
+	last         ExportResult
+	lastSnapshot SnapshotResult
+}
+
+type leaderExportOp struct {
+	doneC    chan struct{}
+	result   ExportResult
+	snapshot SnapshotResult
+	err      error
+}
+
+func (n *node) getExportResult(opt SnapshotOption, index uint64) ExportResult {
+	result := ExportResult{Index: index, ReplicaID: n.replicaID}
+	if opt.ExportSink == nil {
+		result.Locator = n.snapshotter.fs.PathJoin(opt.ExportPath,
+			server.GetSnapshotDirName(index))
+	}
+	return result
+}
+
+func (n *node) notLeaderError() error {
+	leaderID, term, ok := n.getLeaderID()
+	if !ok {
+		return &NotLeaderError{ShardID: n.shardID}
+	}
+	addr, _, err := n.nodeRegistry.Resolve(n.shardID, leaderID)
+	if err != nil {
+		addr = ""
+	}
+	return &NotLeaderError{
+		ShardID:       n.shardID,
+		LeaderID:      leaderID,
+		Term:          term,
+		LeaderAddress: addr,
+	}
+}
+
+// isLeaderInTerm returns a boolean value indicating whether the replica is
+// the leader in the specified term.
+func (n *node) isLeaderInTerm(term uint64) bool {
+	leaderID, t, ok := n.getLeaderID()
+	return ok && leaderID == n.replicaID && t == term
+}
+
+// abortLeaderExport aborts the leader only export when the leadership was
+// lost before the export is committed.
+func (n *node) abortLeaderExport(req rsm.SSRequest, ssenv server.SSEnv) {
+	plog.Warningf("%s lost leadership in term %d, export aborted",
+		n.id(), req.LeaderTerm)
+	if req.Sink != nil {
+		req.Sink.Abort()
+	} else {
+		ssenv.MustRemoveTempDir()
+	}
+	n.pendingSnapshot.reject(req.Key,
+		&LeaderChangedError{ShardID: n.shardID, Term: req.LeaderTerm})
+}
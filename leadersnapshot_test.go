@@ -0,0 +1,292 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/transport"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// blockingExportSink is an ExportSink that blocks the creation of the first
+// file until released.
+type blockingExportSink struct {
+	startedC  chan struct{}
+	releaseC  chan struct{}
+	once      sync.Once
+	mu        sync.Mutex
+	aborted   bool
+	committed bool
+}
+
+func newBlockingExportSink() *blockingExportSink {
+	return &blockingExportSink{
+		startedC: make(chan struct{}),
+		releaseC: make(chan struct{}),
+	}
+}
+
+func (s *blockingExportSink) CreateFile(name string) (io.WriteCloser, error) {
+	s.once.Do(func() { close(s.startedC) })
+	<-s.releaseC
+	return &memObject{}, nil
+}
+
+func (s *blockingExportSink) Commit(meta pb.Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.committed = true
+	return nil
+}
+
+func (s *blockingExportSink) Abort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aborted = true
+}
+
+func startLeaderSnapshotTestShard(t *testing.T, fs vfs.IFS) []*NodeHost {
+	var nhs []*NodeHost
+	for replicaID := uint64(1); replicaID <= 3; replicaID++ {
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    replicaID,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+		}
+		nhs = append(nhs, startThreeReplicaTestShard(t, fs, rc, nil))
+	}
+	for _, nh := range nhs {
+		waitForLeaderToBeElected(t, nh, 1)
+	}
+	return nhs
+}
+
+func getLeaderSnapshotTestLeader(t *testing.T, nhs []*NodeHost) uint64 {
+	leaderID, _, ok, err := nhs[0].GetLeaderID(1)
+	if err != nil || !ok {
+		t.Fatalf("failed to get the leader, %v", err)
+	}
+	for _, nh := range nhs {
+		waitForLeaderID(t, nh, leaderID)
+	}
+	return leaderID
+}
+
+func getLeaderSnapshotExportDir(t *testing.T, fs vfs.IFS, nh *NodeHost) string {
+	dir := fs.PathJoin(nh.NodeHostConfig().NodeHostDir, "export")
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("failed to create dir %v", err)
+	}
+	return dir
+}
+
+// predateProtocolVersion makes the NodeHost look like it runs a version of
+// dragonboat that doesn't advertise its protocol version.
+func predateProtocolVersion(nh *NodeHost) {
+	tt := nh.transport.(*transport.Transport)
+	tt.SetPreSendBatchHook(func(mb pb.MessageBatch) (pb.MessageBatch, bool) {
+		for i := range mb.Requests {
+			mb.Requests[i].ProtocolVersion = 0
+		}
+		return mb, true
+	})
+}
+
+func TestLeaderOnlyOptionRequiresExported(t *testing.T) {
+	opt := SnapshotOption{LeaderOnly: true}
+	if err := opt.Validate(); err != ErrInvalidOption {
+		t.Errorf("unexpected error %v", err)
+	}
+	opt.Exported = true
+	if err := opt.Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestConcurrentLeaderOnlyExportsShareOneSnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		nhs := startLeaderSnapshotTestShard(t, fs)
+		for _, nh := range nhs {
+			defer nh.Close()
+		}
+		leaderID := getLeaderSnapshotTestLeader(t, nhs)
+		makeProposals(nhs[leaderID-1])
+		dirs := make([]string, len(nhs))
+		for i, nh := range nhs {
+			dirs[i] = getLeaderSnapshotExportDir(t, fs, nh)
+		}
+		results := make([]ExportResult, len(nhs))
+		errs := make([]error, len(nhs))
+		var wg sync.WaitGroup
+		for i, nh := range nhs {
+			wg.Add(1)
+			go func(i int, nh *NodeHost) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+				defer cancel()
+				opt := SnapshotOption{ExportPath: dirs[i], LeaderOnly: true}
+				results[i], errs[i] = nh.SyncExportSnapshot(ctx, 1, opt)
+			}(i, nh)
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err != nil {
+				t.Fatalf("replica %d failed to export, %v", i+1, err)
+			}
+			if results[i] != results[0] {
+				t.Errorf("unexpected result %+v, want %+v", results[i], results[0])
+			}
+		}
+		if results[0].ReplicaID != leaderID {
+			t.Errorf("exported by %d, leader %d", results[0].ReplicaID, leaderID)
+		}
+		count := 0
+		for _, dir := range dirs {
+			names, err := fs.List(dir)
+			if err != nil {
+				t.Fatalf("failed to list %v", err)
+			}
+			for _, name := range names {
+				if strings.HasPrefix(name, "snapshot-") {
+					count++
+				}
+			}
+		}
+		if count != 1 {
+			t.Errorf("got %d exported snapshots, want 1", count)
+		}
+		if _, err := fs.Stat(results[0].Locator); err != nil {
+			t.Errorf("exported snapshot not found, %v", err)
+		}
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
+func TestLeaderOnlyExportWithoutForwardingFailsOnFollower(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		nhs := startLeaderSnapshotTestShard(t, fs)
+		for _, nh := range nhs {
+			defer nh.Close()
+		}
+		leaderID := getLeaderSnapshotTestLeader(t, nhs)
+		follower := nhs[leaderID%3]
+		ctx, cancel := context.WithTimeout(context.Background(), pto(follower))
+		defer cancel()
+		opt := SnapshotOption{
+			Exported:     true,
+			ExportPath:   getLeaderSnapshotExportDir(t, fs, follower),
+			LeaderOnly:   true,
+			NoForwarding: true,
+		}
+		_, err := follower.SyncRequestSnapshot(ctx, 1, opt)
+		var nle *NotLeaderError
+		if !errors.As(err, &nle) || !errors.Is(err, ErrNotLeader) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if nle.LeaderID != leaderID {
+			t.Errorf("leader %d, want %d", nle.LeaderID, leaderID)
+		}
+		if want := getThreeReplicaTestPeers()[leaderID]; nle.LeaderAddress != want {
+			t.Errorf("leader address %s, want %s", nle.LeaderAddress, want)
+		}
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
+func TestLeaderOnlyExportIsNotForwardedToLeaderPredatingForwarding(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		nhs := startLeaderSnapshotTestShard(t, fs)
+		for _, nh := range nhs {
+			defer nh.Close()
+		}
+		leaderID := getLeaderSnapshotTestLeader(t, nhs)
+		predateProtocolVersion(nhs[leaderID-1])
+		time.Sleep(500 * time.Millisecond)
+		follower := nhs[leaderID%3]
+		ctx, cancel := context.WithTimeout(context.Background(), pto(follower))
+		defer cancel()
+		opt := SnapshotOption{
+			Exported:   true,
+			ExportPath: getLeaderSnapshotExportDir(t, fs, follower),
+			LeaderOnly: true,
+		}
+		_, err := follower.SyncRequestSnapshot(ctx, 1, opt)
+		var nle *NotLeaderError
+		if !errors.As(err, &nle) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if nle.LeaderID != leaderID {
+			t.Errorf("leader %d, want %d", nle.LeaderID, leaderID)
+		}
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
+func TestLeaderOnlyExportIsAbortedWhenLeaderChanges(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		nhs := startLeaderSnapshotTestShard(t, fs)
+		for _, nh := range nhs {
+			defer nh.Close()
+		}
+		leaderID := getLeaderSnapshotTestLeader(t, nhs)
+		leader := nhs[leaderID-1]
+		sink := newBlockingExportSink()
+		errC := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(leader))
+			defer cancel()
+			opt := SnapshotOption{
+				Exported:   true,
+				ExportSink: sink,
+				LeaderOnly: true,
+			}
+			_, err := leader.SyncExportSnapshot(ctx, 1, opt)
+			errC <- err
+		}()
+		<-sink.startedC
+		target := leaderID%3 + 1
+		if err := leader.RequestLeaderTransfer(1, target); err != nil {
+			t.Fatalf("failed to request leader transfer %v", err)
+		}
+		waitForLeaderID(t, leader, target)
+		close(sink.releaseC)
+		err := <-errC
+		var lce *LeaderChangedError
+		if !errors.As(err, &lce) || !errors.Is(err, ErrLeaderChanged) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		if !sink.aborted || sink.committed {
+			t.Errorf("sink not aborted, %+v", sink)
+		}
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
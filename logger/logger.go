@@ -19,6 +19,7 @@ package logger
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/lni/dragonboat/v4/internal/invariants"
 )
@@ -39,6 +40,10 @@ const (
 	DEBUG
 )
 
+const (
+	levelNotSet int32 = -100
+)
+
 // Factory is the factory method for creating logger used for the
 // specified package.
 type Factory func(pkgName string) ILogger
@@ -79,56 +84,158 @@ func GetMonkeyLogger(pkgName string) ILogger {
 	return getILogger(pkgName, true)
 }
 
-func getILogger(pkgName string, monkey bool) ILogger {
+func getILogger(pkgName string, monkey bool) *dragonboatLogger {
 	_loggers.mu.Lock()
 	defer _loggers.mu.Unlock()
 	l, ok := _loggers.loggers[pkgName]
 	if !ok {
-		l = &dragonboatLogger{pkgName: pkgName, monkeyLogger: monkey}
+		l = newDragonboatLogger(pkgName, monkey)
 		_loggers.loggers[pkgName] = l
 	}
 	return l
 }
 
+// dragonboatLogger is the logger returned to dragonboat packages. The
+// underlying ILogger is created on first use. It keeps the package log level
+// so records can be filtered by their shard log levels, the underlying ILogger
+// is set to the most verbose level required by the package or any shard.
 type dragonboatLogger struct {
 	logger       ILogger
 	pkgName      string
 	mu           sync.Mutex
+	level        int32
 	monkeyLogger bool
 }
 
-var _ ILogger = (*dragonboatLogger)(nil)
+var _ IStructuredLogger = (*dragonboatLogger)(nil)
+
+func newDragonboatLogger(pkgName string, monkey bool) *dragonboatLogger {
+	return &dragonboatLogger{
+		pkgName:      pkgName,
+		monkeyLogger: monkey,
+		level:        levelNotSet,
+	}
+}
 
 func (d *dragonboatLogger) get() ILogger {
 	if d.monkeyLogger && !invariants.MonkeyTest {
 		return _nullLogger
 	}
 	d.mu.Lock()
-	defer d.mu.Unlock()
+	created := false
 	if d.logger == nil {
 		d.logger = _loggers.createILogger(d.pkgName)
+		created = true
+	}
+	l := d.logger
+	d.mu.Unlock()
+	if created && _shardLevels.inUse() {
+		d.syncLevel()
 	}
-	return d.logger
+	return l
+}
+
+// syncLevel sets the level of the underlying ILogger to the most verbose one
+// required by the package or any shard.
+func (d *dragonboatLogger) syncLevel() {
+	if _shardLevels.inUse() {
+		atomic.CompareAndSwapInt32(&d.level, levelNotSet, int32(INFO))
+	}
+	level := atomic.LoadInt32(&d.level)
+	if level == levelNotSet {
+		return
+	}
+	effective := LogLevel(level)
+	if max, ok := _shardLevels.max(); ok && max > effective {
+		effective = max
+	}
+	d.get().SetLevel(effective)
+}
+
+// enabled returns a boolean value indicating whether a record of the specified
+// level and fields should be emitted. Records are passed to the underlying
+// ILogger when the package level is not known.
+func (d *dragonboatLogger) enabled(level LogLevel, fields []Field) bool {
+	if shardLevel, ok := _shardLevels.get(fields); ok {
+		return level <= shardLevel
+	}
+	pkgLevel := atomic.LoadInt32(&d.level)
+	return pkgLevel == levelNotSet || level <= LogLevel(pkgLevel)
 }
 
 func (d *dragonboatLogger) SetLevel(l LogLevel) {
-	d.get().SetLevel(l)
+	atomic.StoreInt32(&d.level, int32(l))
+	d.syncLevel()
 }
 
 func (d *dragonboatLogger) Debugf(format string, args ...interface{}) {
-	d.get().Debugf(format, args...)
+	if d.enabled(DEBUG, nil) {
+		d.get().Debugf(format, args...)
+	}
 }
 
 func (d *dragonboatLogger) Infof(format string, args ...interface{}) {
-	d.get().Infof(format, args...)
+	if d.enabled(INFO, nil) {
+		d.get().Infof(format, args...)
+	}
 }
 
 func (d *dragonboatLogger) Warningf(format string, args ...interface{}) {
-	d.get().Warningf(format, args...)
+	if d.enabled(WARNING, nil) {
+		d.get().Warningf(format, args...)
+	}
 }
 
 func (d *dragonboatLogger) Errorf(format string, args ...interface{}) {
-	d.get().Errorf(format, args...)
+	if d.enabled(ERROR, nil) {
+		d.get().Errorf(format, args...)
+	}
+}
+
+func (d *dragonboatLogger) Debugw(msg string, fields ...Field) {
+	d.logw(DEBUG, msg, fields)
+}
+
+func (d *dragonboatLogger) Infow(msg string, fields ...Field) {
+	d.logw(INFO, msg, fields)
+}
+
+func (d *dragonboatLogger) Warningw(msg string, fields ...Field) {
+	d.logw(WARNING, msg, fields)
+}
+
+func (d *dragonboatLogger) Errorw(msg string, fields ...Field) {
+	d.logw(ERROR, msg, fields)
+}
+
+func (d *dragonboatLogger) logw(level LogLevel, msg string, fields []Field) {
+	if !d.enabled(level, fields) {
+		return
+	}
+	l := d.get()
+	if sl, ok := l.(IStructuredLogger); ok {
+		switch level {
+		case DEBUG:
+			sl.Debugw(msg, fields...)
+		case INFO:
+			sl.Infow(msg, fields...)
+		case WARNING:
+			sl.Warningw(msg, fields...)
+		default:
+			sl.Errorw(msg, fields...)
+		}
+		return
+	}
+	switch level {
+	case DEBUG:
+		l.Debugf("%s", formatFields(msg, fields))
+	case INFO:
+		l.Infof("%s", formatFields(msg, fields))
+	case WARNING:
+		l.Warningf("%s", formatFields(msg, fields))
+	default:
+		l.Errorf("%s", formatFields(msg, fields))
+	}
 }
 
 func (d *dragonboatLogger) Panicf(format string, args ...interface{}) {
@@ -141,6 +248,18 @@ type sysLoggers struct {
 	mu            sync.Mutex
 }
 
+func (l *sysLoggers) syncLevels() {
+	l.mu.Lock()
+	loggers := make([]*dragonboatLogger, 0, len(l.loggers))
+	for _, d := range l.loggers {
+		loggers = append(loggers, d)
+	}
+	l.mu.Unlock()
+	for _, d := range loggers {
+		d.syncLevel()
+	}
+}
+
 func (l *sysLoggers) createILogger(pkgName string) ILogger {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -0,0 +1,165 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+
+/*
+Package slogger provides an IStructuredLogger implementation based on the
+log/slog package of the standard library.
+
+Use it by setting the logger factory before creating any NodeHost instance:
+
+	logger.SetLoggerFactory(slogger.NewFactory(slog.Default()))
+*/
+package slogger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/lni/dragonboat/v4/logger"
+)
+
+const (
+	// PackageKey is the key of the attribute carrying the dragonboat package
+	// name.
+	PackageKey = "pkg"
+)
+
+// NewFactory returns a logger.Factory that creates loggers writing to the
+// specified slog.Logger. Each package has its own log level, it is INFO by
+// default.
+func NewFactory(l *slog.Logger) logger.Factory {
+	return func(pkgName string) logger.ILogger {
+		s := &slogLogger{}
+		s.level.Set(slog.LevelInfo)
+		s.logger = slog.New(&levelHandler{
+			level:   &s.level,
+			handler: l.Handler(),
+		}).With(PackageKey, pkgName)
+		return s
+	}
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+	level  slog.LevelVar
+}
+
+var _ logger.IStructuredLogger = (*slogLogger)(nil)
+
+func (s *slogLogger) SetLevel(level logger.LogLevel) {
+	s.level.Set(toLevel(level))
+}
+
+func (s *slogLogger) Debugf(format string, args ...interface{}) {
+	s.logf(slog.LevelDebug, format, args)
+}
+
+func (s *slogLogger) Infof(format string, args ...interface{}) {
+	s.logf(slog.LevelInfo, format, args)
+}
+
+func (s *slogLogger) Warningf(format string, args ...interface{}) {
+	s.logf(slog.LevelWarn, format, args)
+}
+
+func (s *slogLogger) Errorf(format string, args ...interface{}) {
+	s.logf(slog.LevelError, format, args)
+}
+
+func (s *slogLogger) Panicf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	s.logger.Error(msg)
+	panic(msg)
+}
+
+func (s *slogLogger) Debugw(msg string, fields ...logger.Field) {
+	s.logw(slog.LevelDebug, msg, fields)
+}
+
+func (s *slogLogger) Infow(msg string, fields ...logger.Field) {
+	s.logw(slog.LevelInfo, msg, fields)
+}
+
+func (s *slogLogger) Warningw(msg string, fields ...logger.Field) {
+	s.logw(slog.LevelWarn, msg, fields)
+}
+
+func (s *slogLogger) Errorw(msg string, fields ...logger.Field) {
+	s.logw(slog.LevelError, msg, fields)
+}
+
+func (s *slogLogger) logf(level slog.Level,
+	format string, args []interface{}) {
+	ctx := context.Background()
+	if s.logger.Enabled(ctx, level) {
+		s.logger.Log(ctx, level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (s *slogLogger) logw(level slog.Level, msg string, fields []logger.Field) {
+	ctx := context.Background()
+	if !s.logger.Enabled(ctx, level) {
+		return
+	}
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, f := range fields {
+		attrs = append(attrs, slog.Any(f.Key, f.Value))
+	}
+	s.logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+func toLevel(level logger.LogLevel) slog.Level {
+	switch level {
+	case logger.CRITICAL:
+		return slog.LevelError + 4
+	case logger.ERROR:
+		return slog.LevelError
+	case logger.WARNING:
+		return slog.LevelWarn
+	case logger.INFO:
+		return slog.LevelInfo
+	case logger.DEBUG:
+		return slog.LevelDebug
+	default:
+		panic("unexpected level")
+	}
+}
+
+// levelHandler is a slog.Handler that applies the package log level before
+// passing records to the wrapped handler.
+type levelHandler struct {
+	level   slog.Leveler
+	handler slog.Handler
+}
+
+var _ slog.Handler = (*levelHandler)(nil)
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.handler.Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithGroup(name)}
+}
@@ -0,0 +1,68 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+
+package slogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/lni/dragonboat/v4/logger"
+)
+
+func TestFieldsAreEmittedAsAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	h := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	l := NewFactory(slog.New(h))("raft").(logger.IStructuredLogger)
+	l.Infow("became leader",
+		logger.ShardID(1), logger.ReplicaID(2), logger.Term(3))
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("failed to unmarshal %s, %v", buf.String(), err)
+	}
+	if record["msg"] != "became leader" || record["level"] != "INFO" ||
+		record[PackageKey] != "raft" {
+		t.Errorf("unexpected record %v", record)
+	}
+	if record[logger.ShardIDKey] != float64(1) ||
+		record[logger.ReplicaIDKey] != float64(2) ||
+		record[logger.TermKey] != float64(3) {
+		t.Errorf("unexpected fields %v", record)
+	}
+}
+
+func TestPackageLevelIsApplied(t *testing.T) {
+	var buf bytes.Buffer
+	h := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	f := NewFactory(slog.New(h))
+	l := f("raft")
+	l.Debugf("debug %d", 1)
+	if buf.Len() != 0 {
+		t.Errorf("debug record emitted at the default INFO level")
+	}
+	l.SetLevel(logger.DEBUG)
+	l.Debugf("debug %d", 2)
+	if buf.Len() == 0 {
+		t.Errorf("debug record not emitted")
+	}
+	buf.Reset()
+	f("rsm").Debugf("debug %d", 3)
+	if buf.Len() != 0 {
+		t.Errorf("level of the raft package applied to the rsm package")
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// ShardIDKey is the key of the field carrying the shard ID.
+	ShardIDKey = "shardid"
+	// ReplicaIDKey is the key of the field carrying the replica ID.
+	ReplicaIDKey = "replicaid"
+	// TermKey is the key of the field carrying the Raft term.
+	TermKey = "term"
+	// ErrorKey is the key of the field carrying an error.
+	ErrorKey = "error"
+)
+
+// Field is a key/value pair attached to a structured log record.
+type Field struct {
+	Value interface{}
+	Key   string
+}
+
+// Any returns a Field with the specified key and value.
+func Any(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// String returns a Field with the specified key and string value.
+func String(key string, value string) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Uint64 returns a Field with the specified key and uint64 value.
+func Uint64(key string, value uint64) Field {
+	return Field{Key: key, Value: value}
+}
+
+// ShardID returns the Field carrying the specified shard ID. Records with
+// such field are filtered using the log level set by SetShardLogLevel.
+func ShardID(shardID uint64) Field {
+	return Field{Key: ShardIDKey, Value: shardID}
+}
+
+// ReplicaID returns the Field carrying the specified replica ID.
+func ReplicaID(replicaID uint64) Field {
+	return Field{Key: ReplicaIDKey, Value: replicaID}
+}
+
+// Term returns the Field carrying the specified Raft term.
+func Term(term uint64) Field {
+	return Field{Key: TermKey, Value: term}
+}
+
+// Error returns the Field carrying the specified error.
+func Error(err error) Field {
+	return Field{Key: ErrorKey, Value: err}
+}
+
+// IStructuredLogger is the optional interface implemented by ILogger
+// instances capable of emitting structured log records. When the ILogger
+// returned by the Factory implements IStructuredLogger, fields such as shard
+// ID, replica ID and term are emitted by dragonboat as key/value pairs rather
+// than being formatted into the message.
+type IStructuredLogger interface {
+	ILogger
+	Debugw(msg string, fields ...Field)
+	Infow(msg string, fields ...Field)
+	Warningw(msg string, fields ...Field)
+	Errorw(msg string, fields ...Field)
+}
+
+// GetStructuredLogger returns the logger for the specified package name. The
+// returned logger falls back to formatting fields into the message when the
+// underlying ILogger doesn't implement IStructuredLogger.
+func GetStructuredLogger(pkgName string) IStructuredLogger {
+	return getILogger(pkgName, false)
+}
+
+// SetShardLogLevel sets the log level of records carrying the ShardID field
+// of the specified shard, it overrides the level of the package that emits
+// the record. It can be used to silence a noisy shard or to get DEBUG logs of
+// a suspect shard at runtime. Package levels not set by ILogger.SetLevel are
+// assumed to be INFO once shard log levels are used.
+func SetShardLogLevel(shardID uint64, level LogLevel) {
+	_shardLevels.mu.Lock()
+	_shardLevels.levels[shardID] = level
+	atomic.StoreInt32(&_shardLevels.count, int32(len(_shardLevels.levels)))
+	_shardLevels.mu.Unlock()
+	_loggers.syncLevels()
+}
+
+// ClearShardLogLevel removes the log level set for the specified shard.
+func ClearShardLogLevel(shardID uint64) {
+	_shardLevels.mu.Lock()
+	delete(_shardLevels.levels, shardID)
+	atomic.StoreInt32(&_shardLevels.count, int32(len(_shardLevels.levels)))
+	_shardLevels.mu.Unlock()
+	_loggers.syncLevels()
+}
+
+type shardLevels struct {
+	levels map[uint64]LogLevel
+	mu     sync.RWMutex
+	count  int32
+}
+
+var _shardLevels = &shardLevels{levels: make(map[uint64]LogLevel)}
+
+func (s *shardLevels) inUse() bool {
+	return atomic.LoadInt32(&s.count) > 0
+}
+
+// get returns the log level of the shard specified in fields.
+func (s *shardLevels) get(fields []Field) (LogLevel, bool) {
+	if !s.inUse() {
+		return 0, false
+	}
+	for _, f := range fields {
+		if f.Key != ShardIDKey {
+			continue
+		}
+		shardID, ok := f.Value.(uint64)
+		if !ok {
+			return 0, false
+		}
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		level, ok := s.levels[shardID]
+		return level, ok
+	}
+	return 0, false
+}
+
+// max returns the most verbose shard log level.
+func (s *shardLevels) max() (LogLevel, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result, ok := CRITICAL, false
+	for _, level := range s.levels {
+		if !ok || level > result {
+			result, ok = level, true
+		}
+	}
+	return result, ok
+}
+
+// formatFields returns the message with fields appended as key=value pairs,
+// it is used when the ILogger doesn't support structured logging.
+func formatFields(msg string, fields []Field) string {
+	if len(fields) == 0 {
+		return msg
+	}
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for _, f := range fields {
+		sb.WriteString(" ")
+		sb.WriteString(f.Key)
+		sb.WriteString("=")
+		sb.WriteString(fmt.Sprint(f.Value))
+	}
+	return sb.String()
+}
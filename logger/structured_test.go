@@ -0,0 +1,174 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"fmt"
+	"testing"
+)
+
+type testRecord struct {
+	msg    string
+	fields []Field
+	level  LogLevel
+}
+
+type testLogger struct {
+	records []testRecord
+	level   LogLevel
+}
+
+func (l *testLogger) SetLevel(level LogLevel) { l.level = level }
+
+func (l *testLogger) logf(level LogLevel, format string, args ...interface{}) {
+	if level <= l.level {
+		l.records = append(l.records,
+			testRecord{level: level, msg: fmt.Sprintf(format, args...)})
+	}
+}
+
+func (l *testLogger) Debugf(f string, args ...interface{})   { l.logf(DEBUG, f, args...) }
+func (l *testLogger) Infof(f string, args ...interface{})    { l.logf(INFO, f, args...) }
+func (l *testLogger) Warningf(f string, args ...interface{}) { l.logf(WARNING, f, args...) }
+func (l *testLogger) Errorf(f string, args ...interface{})   { l.logf(ERROR, f, args...) }
+func (l *testLogger) Panicf(f string, args ...interface{})   { panic(fmt.Sprintf(f, args...)) }
+
+type testStructuredLogger struct {
+	testLogger
+}
+
+func (l *testStructuredLogger) logw(level LogLevel, msg string, fields []Field) {
+	if level <= l.level {
+		l.records = append(l.records,
+			testRecord{level: level, msg: msg, fields: fields})
+	}
+}
+
+func (l *testStructuredLogger) Debugw(msg string, fields ...Field) {
+	l.logw(DEBUG, msg, fields)
+}
+
+func (l *testStructuredLogger) Infow(msg string, fields ...Field) {
+	l.logw(INFO, msg, fields)
+}
+
+func (l *testStructuredLogger) Warningw(msg string, fields ...Field) {
+	l.logw(WARNING, msg, fields)
+}
+
+func (l *testStructuredLogger) Errorw(msg string, fields ...Field) {
+	l.logw(ERROR, msg, fields)
+}
+
+func newTestDragonboatLogger(t *testing.T, l ILogger) *dragonboatLogger {
+	d := newDragonboatLogger(t.Name(), false)
+	d.logger = l
+	_loggers.mu.Lock()
+	_loggers.loggers[t.Name()] = d
+	_loggers.mu.Unlock()
+	t.Cleanup(func() {
+		_loggers.mu.Lock()
+		delete(_loggers.loggers, t.Name())
+		_loggers.mu.Unlock()
+	})
+	return d
+}
+
+func TestFieldsArePassedToStructuredLogger(t *testing.T) {
+	tl := &testStructuredLogger{testLogger{level: DEBUG}}
+	d := newTestDragonboatLogger(t, tl)
+	d.Infow("became leader", ShardID(1), ReplicaID(2), Term(3))
+	if len(tl.records) != 1 {
+		t.Fatalf("unexpected records %+v", tl.records)
+	}
+	r := tl.records[0]
+	if r.msg != "became leader" || r.level != INFO || len(r.fields) != 3 {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	expected := []Field{
+		{Key: ShardIDKey, Value: uint64(1)},
+		{Key: ReplicaIDKey, Value: uint64(2)},
+		{Key: TermKey, Value: uint64(3)},
+	}
+	for i, f := range expected {
+		if r.fields[i] != f {
+			t.Errorf("field %d, got %+v, want %+v", i, r.fields[i], f)
+		}
+	}
+}
+
+func TestFieldsAreFormattedForPlainLogger(t *testing.T) {
+	tl := &testLogger{level: DEBUG}
+	d := newTestDragonboatLogger(t, tl)
+	d.Warningw("became candidate", ShardID(1), Term(3), String("target", "a:1"))
+	if len(tl.records) != 1 {
+		t.Fatalf("unexpected records %+v", tl.records)
+	}
+	expected := "became candidate shardid=1 term=3 target=a:1"
+	if r := tl.records[0]; r.msg != expected || r.level != WARNING {
+		t.Errorf("unexpected record %+v", r)
+	}
+}
+
+func TestShardLogLevelOverridesPackageLevel(t *testing.T) {
+	defer ClearShardLogLevel(1)
+	defer ClearShardLogLevel(2)
+	tl := &testStructuredLogger{testLogger{level: DEBUG}}
+	d := newTestDragonboatLogger(t, tl)
+	d.SetLevel(WARNING)
+	if tl.level != WARNING {
+		t.Fatalf("unexpected level %d", tl.level)
+	}
+	SetShardLogLevel(1, DEBUG)
+	SetShardLogLevel(2, ERROR)
+	if tl.level != DEBUG {
+		t.Fatalf("underlying logger level not raised, %d", tl.level)
+	}
+	d.Debugw("shard 1 debug", ShardID(1))
+	d.Warningw("shard 2 warning", ShardID(2))
+	d.Errorw("shard 2 error", ShardID(2))
+	d.Infow("shard 3 info", ShardID(3))
+	d.Warningw("shard 3 warning", ShardID(3))
+	d.Debugf("package debug")
+	d.Warningf("package warning")
+	var msgs []string
+	for _, r := range tl.records {
+		msgs = append(msgs, r.msg)
+	}
+	expected := []string{
+		"shard 1 debug",
+		"shard 2 error",
+		"shard 3 warning",
+		"package warning",
+	}
+	if fmt.Sprint(msgs) != fmt.Sprint(expected) {
+		t.Errorf("got %v, want %v", msgs, expected)
+	}
+	ClearShardLogLevel(1)
+	ClearShardLogLevel(2)
+	if tl.level != WARNING {
+		t.Errorf("underlying logger level not restored, %d", tl.level)
+	}
+}
+
+func TestPackageLevelIsNotChangedWithoutShardLogLevel(t *testing.T) {
+	tl := &testLogger{level: ERROR}
+	d := newTestDragonboatLogger(t, tl)
+	d.Infof("info")
+	d.Errorf("error")
+	if len(tl.records) != 1 || tl.records[0].msg != "error" {
+		t.Errorf("unexpected records %+v", tl.records)
+	}
+}
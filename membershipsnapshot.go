@@ -0,0 +1,110 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync/atomic"
+)
+
+// MembershipSnapshotDecision is the decision made by the
+// config.Config.SnapshotOnMembershipChange policy for the last applied
+// membership change.
+type MembershipSnapshotDecision uint8
+
+const (
+	// MembershipSnapshotNone indicates that the policy is disabled or no
+	// membership change has been applied since the replica was started.
+	MembershipSnapshotNone MembershipSnapshotDecision = iota
+	// MembershipSnapshotRequested indicates that a snapshot was requested.
+	MembershipSnapshotRequested
+	// MembershipSnapshotNotLeader indicates that no snapshot was requested as
+	// the replica was not the leader.
+	MembershipSnapshotNotLeader
+	// MembershipSnapshotLogTooShort indicates that no snapshot was requested as
+	// the replica retained less than config.Config.MembershipChangeSnapshotEntries
+	// Raft log entries.
+	MembershipSnapshotLogTooShort
+	// MembershipSnapshotUpToDate indicates that no snapshot was requested as a
+	// snapshot has already been created or requested at the applied index.
+	MembershipSnapshotUpToDate
+)
+
+var membershipSnapshotDecisionNames = [...]string{
+	"None",
+	"Requested",
+	"NotLeader",
+	"LogTooShort",
+	"UpToDate",
+}
+
+func (d MembershipSnapshotDecision) String() string {
+	return membershipSnapshotDecisionNames[d]
+}
+
+// membershipChanged records that a membership change has been applied so the
+// SnapshotOnMembershipChange policy is evaluated on the next tick. It is
+// invoked by the apply worker.
+func (n *node) membershipChanged() {
+	if n.config.SnapshotOnMembershipChange {
+		atomic.StoreUint32(&n.membershipSSPending, 1)
+	}
+}
+
+// membershipChangeSnapshotRequired returns a boolean value indicating whether
+// a snapshot should be requested as a membership change has been applied. It
+// is invoked on each tick.
+func (n *node) membershipChangeSnapshotRequired() bool {
+	if atomic.LoadUint32(&n.membershipSSPending) == 0 ||
+		!n.initialized() || n.isWitness() {
+		return false
+	}
+	if n.isBusySnapshotting() {
+		// evaluated again on the next tick
+		return false
+	}
+	atomic.StoreUint32(&n.membershipSSPending, 0)
+	applied := n.sm.GetLastApplied()
+	decision := n.getMembershipSnapshotDecision(applied)
+	atomic.StoreUint64(&n.membershipSSIndex, applied)
+	atomic.StoreUint32(&n.membershipSSDecision, uint32(decision))
+	if decision != MembershipSnapshotRequested {
+		plog.Debugf("%s membership changed, snapshot not requested, %s",
+			n.id(), decision)
+		return false
+	}
+	plog.Infof("%s membership changed, requested to create %s",
+		n.id(), n.ssid(applied))
+	n.ss.setReqIndex(applied)
+	return true
+}
+
+func (n *node) getMembershipSnapshotDecision(
+	applied uint64) MembershipSnapshotDecision {
+	if !n.isLeader() {
+		return MembershipSnapshotNotLeader
+	}
+	if applied <= n.ss.getIndex() || applied <= n.ss.getReqIndex() {
+		return MembershipSnapshotUpToDate
+	}
+	first, last := n.logReader.GetRange()
+	retained := uint64(0)
+	if last >= first {
+		retained = last - first + 1
+	}
+	if retained < n.config.MembershipChangeSnapshotEntries {
+		return MembershipSnapshotLogTooShort
+	}
+	return MembershipSnapshotRequested
+}
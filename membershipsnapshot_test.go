@@ -0,0 +1,155 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func getMembershipSnapshotTestConfig(replicaID uint64,
+	minEntries uint64) config.Config {
+	return config.Config{
+		ShardID:                         1,
+		ReplicaID:                       replicaID,
+		ElectionRTT:                     10,
+		HeartbeatRTT:                    1,
+		CheckQuorum:                     true,
+		CompactionOverhead:              5,
+		SnapshotOnMembershipChange:      true,
+		MembershipChangeSnapshotEntries: minEntries,
+	}
+}
+
+// startLongLogTestShard starts a single replica shard on the first NodeHost
+// and makes proposals without creating any snapshot.
+func startLongLogTestShard(t *testing.T, nh *NodeHost, minEntries uint64) {
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &PST{}
+	}
+	peers := map[uint64]string{1: memtransport.Address(1)}
+	rc := getMembershipSnapshotTestConfig(1, minEntries)
+	if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+		t.Fatalf("failed to start replica %v", err)
+	}
+	waitForLeaderToBeElected(t, nh, 1)
+	for i := 0; i < 100; i++ {
+		if !makeTestProposal(nh, 10) {
+			t.Fatalf("failed to make proposal")
+		}
+	}
+}
+
+func explainTestCompaction(t *testing.T, nh *NodeHost) CompactionReport {
+	r, err := nh.ExplainCompaction(1)
+	if err != nil {
+		t.Fatalf("failed to explain compaction %v", err)
+	}
+	return r
+}
+
+// addMembershipSnapshotTestReplica adds replica 2 to the shard and returns the
+// CompactionReport once the decision for the membership change is made.
+func addMembershipSnapshotTestReplica(t *testing.T,
+	nh *NodeHost) CompactionReport {
+	applied := explainTestCompaction(t, nh).AppliedIndex
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+	defer cancel()
+	if err := nh.SyncRequestAddReplica(ctx,
+		1, 2, memtransport.Address(2), 0); err != nil {
+		t.Fatalf("failed to add replica %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		r := explainTestCompaction(t, nh)
+		if r.MembershipSnapshotIndex > applied {
+			return r
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("membership snapshot decision not made")
+	return CompactionReport{}
+}
+
+func TestMembershipChangeSnapshotDecisionIsString(t *testing.T) {
+	if MembershipSnapshotLogTooShort.String() != "LogTooShort" {
+		t.Errorf("unexpected name %s", MembershipSnapshotLogTooShort)
+	}
+}
+
+func TestNewReplicaIsRecoveredFromMembershipChangeSnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		startLongLogTestShard(t, nhs[0], 50)
+		r := addMembershipSnapshotTestReplica(t, nhs[0])
+		if r.MembershipSnapshot != MembershipSnapshotRequested {
+			t.Fatalf("unexpected decision %s", r.MembershipSnapshot)
+		}
+		index := r.MembershipSnapshotIndex
+		// wait for the log to be compacted
+		for i := 0; ; i++ {
+			r := explainTestCompaction(t, nhs[0])
+			if r.SnapshotIndex >= index && r.FirstIndex > index-5 {
+				break
+			}
+			if i > 200 {
+				t.Fatalf("log not compacted, %+v", r)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		createSM := func(uint64, uint64) sm.IStateMachine {
+			return &PST{}
+		}
+		rc := getMembershipSnapshotTestConfig(2, 50)
+		if err := nhs[1].StartReplica(nil, true, createSM, rc); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+		for i := 0; ; i++ {
+			ss, err := nhs[1].mu.logdb.GetSnapshot(1, 2)
+			if err != nil {
+				t.Fatalf("failed to get snapshot %v", err)
+			}
+			if ss.Index >= index {
+				break
+			}
+			if i > 200 {
+				t.Fatalf("replica not recovered from snapshot, index %d, want %d",
+					ss.Index, index)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	memTransportNodeHostTest(t, 2, tf, fs)
+}
+
+func TestMembershipChangeSnapshotIsNotRequestedForShortLog(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		startLongLogTestShard(t, nhs[0], 1000)
+		r := addMembershipSnapshotTestReplica(t, nhs[0])
+		if r.MembershipSnapshot != MembershipSnapshotLogTooShort {
+			t.Fatalf("unexpected decision %s", r.MembershipSnapshot)
+		}
+		if r.SnapshotIndex != 0 {
+			t.Errorf("unexpected snapshot index %d", r.SnapshotIndex)
+		}
+	}
+	memTransportNodeHostTest(t, 2, tf, fs)
+}
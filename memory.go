@@ -0,0 +1,236 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	// memorySoftLimitPercent is the percentage of the memory budget from which
+	// proposals made to shards consuming the most memory are rejected.
+	memorySoftLimitPercent = 80
+)
+
+// entryInMemSize is the in memory size of an entry without its payload.
+var entryInMemSize = pb.GetEntrySliceInMemSize([]pb.Entry{{}})
+
+// MemoryStats contains the memory accounted against the memory budget of the
+// NodeHost, see config.NodeHostConfig.MaxMemoryBytes for details. Sizes are
+// those observed when the usage was last refreshed.
+type MemoryStats struct {
+	// Budget is the configured MaxMemoryBytes value, 0 means unlimited.
+	Budget uint64
+	// InMemLog is the total size of entries kept in the in memory Raft logs.
+	InMemLog uint64
+	// PendingProposals is the total size of proposals queued to be proposed.
+	PendingProposals uint64
+	// InboundMessages is the total size of entries in incoming message queues.
+	InboundMessages uint64
+	// SnapshotStaging is the total size of snapshot chunk data held in memory
+	// by the transport.
+	SnapshotStaging uint64
+	// Rejected is the number of proposals rejected with ErrSystemBusy as the
+	// memory budget was exceeded.
+	Rejected uint64
+	// Tenants is the memory used by local replicas of the shards of each
+	// tenant keyed by the tenant, it is nil when
+	// config.NodeHostConfig.TenantOf is not set. Snapshot chunk data held by
+	// the transport is not attributed to any tenant.
+	Tenants map[string]uint64
+}
+
+// Total returns the total size of accounted memory.
+func (s MemoryStats) Total() uint64 {
+	return s.InMemLog + s.PendingProposals + s.InboundMessages + s.SnapshotStaging
+}
+
+type shardMemory struct {
+	shardID uint64
+	bytes   uint64
+}
+
+// memoryAccountant accounts the memory used by all replicas on the NodeHost
+// against the memory budget. The usage is refreshed by the tick worker, sizes
+// of proposals admitted since the last refresh are charged right away so a
+// burst of proposals can not overrun the budget between two refreshes.
+type memoryAccountant struct {
+	// heavy is the set of shards rejecting proposals once the soft limit is
+	// reached, it is a map[uint64]struct{}
+	heavy    atomic.Value
+	budget   uint64
+	soft     uint64
+	used     uint64
+	admitted uint64
+	rejected uint64
+	shards   []shardMemory
+	mu       struct {
+		sync.Mutex
+		stats MemoryStats
+	}
+}
+
+func newMemoryAccountant(budget uint64) *memoryAccountant {
+	m := &memoryAccountant{
+		budget: budget,
+		soft:   budget / 100 * memorySoftLimitPercent,
+	}
+	m.heavy.Store(map[uint64]struct{}{})
+	m.mu.stats.Budget = budget
+	return m
+}
+
+func (m *memoryAccountant) enabled() bool {
+	return m != nil && m.budget > 0
+}
+
+// admit returns a boolean value indicating whether a proposal of the
+// specified size can be made to the specified shard. The size of the admitted
+// proposal is charged until the next refresh.
+func (m *memoryAccountant) admit(shardID uint64, sz uint64) bool {
+	if !m.enabled() {
+		return true
+	}
+	admitted := atomic.AddUint64(&m.admitted, sz)
+	used := atomic.LoadUint64(&m.used) + admitted
+	if used > m.budget || (used > m.soft && m.isHeavy(shardID)) {
+		atomic.AddUint64(&m.admitted, ^(sz - 1))
+		atomic.AddUint64(&m.rejected, 1)
+		return false
+	}
+	return true
+}
+
+func (m *memoryAccountant) isHeavy(shardID uint64) bool {
+	_, ok := m.heavy.Load().(map[uint64]struct{})[shardID]
+	return ok
+}
+
+// inboundCapacity returns the remaining memory budget for incoming entries.
+func (m *memoryAccountant) inboundCapacity() uint64 {
+	used := atomic.LoadUint64(&m.used) + atomic.LoadUint64(&m.admitted)
+	if used >= m.budget {
+		return 0
+	}
+	return m.budget - used
+}
+
+// refresh updates the memory usage of the specified replicas, staging is the
+// size of snapshot chunk data held in memory by the transport. It is only
+// invoked by the tick worker.
+func (m *memoryAccountant) refresh(nodes []*node, staging uint64) {
+	if !m.enabled() {
+		return
+	}
+	// proposals admitted from now on are either charged or already queued
+	// when the usage is collected, they might be counted twice but they are
+	// never missed
+	atomic.StoreUint64(&m.admitted, 0)
+	var stats MemoryStats
+	stats, m.shards = collectMemoryStats(nodes, staging, m.shards[:0])
+	stats.Budget = m.budget
+	total := stats.Total()
+	atomic.StoreUint64(&m.used, total)
+	m.heavy.Store(getHeavyShards(m.shards, total, m.soft))
+	m.mu.Lock()
+	m.mu.stats = stats
+	m.mu.Unlock()
+}
+
+func (m *memoryAccountant) stats() MemoryStats {
+	m.mu.Lock()
+	stats := m.mu.stats
+	m.mu.Unlock()
+	stats.Rejected = atomic.LoadUint64(&m.rejected)
+	return stats
+}
+
+func collectMemoryStats(nodes []*node, staging uint64,
+	shards []shardMemory) (MemoryStats, []shardMemory) {
+	stats := MemoryStats{SnapshotStaging: staging}
+	for _, n := range nodes {
+		log, proposals, inbound := n.memoryUsage()
+		stats.InMemLog += log
+		stats.PendingProposals += proposals
+		stats.InboundMessages += inbound
+		shards = append(shards, shardMemory{
+			shardID: n.shardID,
+			bytes:   log + proposals + inbound,
+		})
+		if n.tenant != nil {
+			if stats.Tenants == nil {
+				stats.Tenants = make(map[string]uint64)
+			}
+			stats.Tenants[n.tenant.name] += log + proposals + inbound
+		}
+	}
+	return stats, shards
+}
+
+// getHeavyShards returns the shards consuming the most memory, their total
+// usage is at least the usage above the soft limit.
+func getHeavyShards(shards []shardMemory,
+	total uint64, soft uint64) map[uint64]struct{} {
+	heavy := make(map[uint64]struct{})
+	if total <= soft {
+		return heavy
+	}
+	sort.Slice(shards, func(i, j int) bool {
+		return shards[i].bytes > shards[j].bytes
+	})
+	excess := total - soft
+	for _, s := range shards {
+		if s.bytes == 0 {
+			break
+		}
+		heavy[s.shardID] = struct{}{}
+		if s.bytes >= excess {
+			break
+		}
+		excess -= s.bytes
+	}
+	return heavy
+}
+
+// memoryUsage returns the size of entries kept in the in memory Raft log, the
+// size of queued proposals and the size of entries in the incoming message
+// queue of the replica.
+func (n *node) memoryUsage() (uint64, uint64, uint64) {
+	// queues are checked before the in memory log so entries moved from the
+	// queues to the log in the meantime are not missed
+	proposals := n.incomingProposals.pendingSize()
+	inbound := n.mq.Size()
+	return n.p.GetInMemLogSize(), proposals, inbound
+}
+
+// getMemoryStats returns the memory accounted against the memory budget, the
+// usage is collected on demand when the memory budget is not set.
+func (nh *NodeHost) getMemoryStats() MemoryStats {
+	if nh.memory.enabled() {
+		return nh.memory.stats()
+	}
+	nodes := make([]*node, 0)
+	nh.forEachShard(func(shardID uint64, n *node) bool {
+		nodes = append(nodes, n)
+		return true
+	})
+	stats, _ := collectMemoryStats(nodes,
+		nh.transport.GetSnapshotStagingBytes(), nil)
+	return stats
+}
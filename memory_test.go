@@ -0,0 +1,199 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func TestHeavyShardsCoverTheExcessUsage(t *testing.T) {
+	tests := []struct {
+		shards []shardMemory
+		total  uint64
+		soft   uint64
+		heavy  []uint64
+	}{
+		{[]shardMemory{{1, 50}, {2, 20}}, 70, 80, nil},
+		{[]shardMemory{{1, 50}, {2, 40}}, 90, 80, []uint64{1}},
+		{[]shardMemory{{1, 5}, {2, 4}, {3, 3}}, 12, 4, []uint64{1, 2}},
+		{[]shardMemory{{1, 5}, {2, 0}}, 10, 0, []uint64{1}},
+	}
+	for idx, tt := range tests {
+		heavy := getHeavyShards(tt.shards, tt.total, tt.soft)
+		if len(heavy) != len(tt.heavy) {
+			t.Errorf("%d, heavy shards %v, want %v", idx, heavy, tt.heavy)
+		}
+		for _, shardID := range tt.heavy {
+			if _, ok := heavy[shardID]; !ok {
+				t.Errorf("%d, shard %d is not heavy", idx, shardID)
+			}
+		}
+	}
+}
+
+func TestMemoryAccountantAdmitsProposalsWithinBudget(t *testing.T) {
+	m := newMemoryAccountant(1000)
+	if !m.admit(1, 600) {
+		t.Errorf("failed to admit")
+	}
+	if m.admit(2, 500) {
+		t.Errorf("budget exceeded")
+	}
+	if v := m.inboundCapacity(); v != 400 {
+		t.Errorf("inbound capacity %d, want 400", v)
+	}
+	// proposals admitted since the last refresh are no longer charged
+	m.refresh(nil, 0)
+	if !m.admit(2, 500) {
+		t.Errorf("failed to admit")
+	}
+	if v := m.stats().Rejected; v != 1 {
+		t.Errorf("rejected %d, want 1", v)
+	}
+}
+
+func TestMemoryAccountantPrefersRejectingHeavyShards(t *testing.T) {
+	m := newMemoryAccountant(1000)
+	m.heavy.Store(getHeavyShards([]shardMemory{{1, 700}, {2, 150}}, 850, m.soft))
+	atomic.StoreUint64(&m.used, 850)
+	if m.admit(1, 10) {
+		t.Errorf("heavy shard admitted above the soft limit")
+	}
+	if !m.admit(2, 10) {
+		t.Errorf("failed to admit")
+	}
+	if m.admit(2, 200) {
+		t.Errorf("budget exceeded")
+	}
+}
+
+func TestDisabledMemoryAccountantAdmitsAllProposals(t *testing.T) {
+	var m *memoryAccountant
+	if m.enabled() || !m.admit(1, 1024*1024) {
+		t.Errorf("unexpected rejection")
+	}
+	m = newMemoryAccountant(0)
+	if m.enabled() || !m.admit(1, 1024*1024) {
+		t.Errorf("unexpected rejection")
+	}
+}
+
+func TestMemoryBudgetIsEnforcedInMultiShardBurst(t *testing.T) {
+	const budget = 4 * 1024 * 1024
+	inj := &slowSyncInjector{delay: 20 * time.Millisecond}
+	fs := vfs.Wrap(vfs.GetTestFS(), inj)
+	to := &testOption{
+		defaultTestNode: true,
+		updateNodeHostConfig: func(nhc *config.NodeHostConfig) *config.NodeHostConfig {
+			nhc.MaxMemoryBytes = budget
+			return nhc
+		},
+		tf: func(nh *NodeHost) {
+			shards := []uint64{1, 2, 3, 4}
+			for _, shardID := range shards[1:] {
+				cfg := getTestConfig()
+				cfg.ShardID = shardID
+				peers := map[uint64]string{1: nh.RaftAddress()}
+				if err := nh.StartReplica(peers, false,
+					func(uint64, uint64) sm.IStateMachine { return &PST{} }, *cfg); err != nil {
+					t.Fatalf("failed to start shard %d, %v", shardID, err)
+				}
+			}
+			for _, shardID := range shards {
+				waitForLeaderToBeElected(t, nh, shardID)
+			}
+			atomic.StoreInt32(&inj.slow, 1)
+			var peak uint64
+			var busy uint64
+			stopc := make(chan struct{})
+			var sampler sync.WaitGroup
+			sampler.Add(1)
+			go func() {
+				defer sampler.Done()
+				for {
+					if v := nh.GetEngineStats().Memory.Total(); v > peak {
+						peak = v
+					}
+					select {
+					case <-stopc:
+						return
+					case <-time.After(time.Millisecond):
+					}
+				}
+			}()
+			var wg sync.WaitGroup
+			data := make([]byte, 64*1024)
+			deadline := time.Now().Add(time.Second)
+			for i := 0; i < 32; i++ {
+				wg.Add(1)
+				go func(shardID uint64) {
+					defer wg.Done()
+					session := nh.GetNoOPSession(shardID)
+					for time.Now().Before(deadline) {
+						rs, err := nh.Propose(session, data, pto(nh))
+						if err == ErrSystemBusy {
+							atomic.AddUint64(&busy, 1)
+							time.Sleep(time.Millisecond)
+							continue
+						}
+						if err != nil {
+							t.Errorf("failed to make proposal, %v", err)
+							return
+						}
+						rs.Release()
+					}
+				}(shards[i%len(shards)])
+			}
+			wg.Wait()
+			atomic.StoreInt32(&inj.slow, 0)
+			close(stopc)
+			sampler.Wait()
+			if peak == 0 || peak > budget {
+				t.Errorf("peak memory usage %d, budget %d", peak, budget)
+			}
+			if atomic.LoadUint64(&busy) == 0 {
+				t.Errorf("no proposal rejected")
+			}
+			stats := nh.GetEngineStats().Memory
+			if stats.Budget != budget || stats.Rejected == 0 {
+				t.Errorf("unexpected stats %+v", stats)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*pto(nh))
+			defer cancel()
+			for _, shardID := range shards {
+				session := nh.GetNoOPSession(shardID)
+				for {
+					_, err := nh.SyncPropose(ctx, session, data)
+					if err == nil {
+						break
+					}
+					if err != ErrSystemBusy {
+						t.Fatalf("failed to make proposal, %v", err)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
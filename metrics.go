@@ -0,0 +1,526 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+
+	"github.com/lni/dragonboat/v4/internal/server"
+)
+
+const (
+	otherShardsLabel = `shardid="other"`
+)
+
+// nodeHostMetrics contains the NodeHost level metrics. It also limits the
+// number of shards with dedicated series, shards beyond the limit share the
+// aggregated series labeled with shardid="other" and they don't have any
+// gauge.
+type nodeHostMetrics struct {
+	mu               sync.Mutex
+	shards           map[uint64]struct{}
+	maxShards        uint64
+	logDBSave        *metrics.Histogram
+	logDBSaveUpdates *metrics.Histogram
+	logDBPending     *metrics.Gauge
+	nodeHostGauges   []string
+	engineGauges     []string
+	stagingGauges    []string
+	memoryGauges     []string
+	tenantGauges     []string
+	pending          int64
+}
+
+func newNodeHostMetrics(useMetrics bool, maxShards uint64) *nodeHostMetrics {
+	if !useMetrics {
+		return nil
+	}
+	m := &nodeHostMetrics{
+		shards:    make(map[uint64]struct{}),
+		maxShards: maxShards,
+	}
+	name := "dragonboat_logdb_save_seconds"
+	m.logDBSave = metrics.GetOrCreateHistogram(name)
+	name = "dragonboat_logdb_save_updates"
+	m.logDBSaveUpdates = metrics.GetOrCreateHistogram(name)
+	name = "dragonboat_logdb_pending_saves"
+	// gauges of a previously closed NodeHost are replaced
+	metrics.UnregisterMetric(name)
+	m.logDBPending = metrics.GetOrCreateGauge(name, func() float64 {
+		return float64(atomic.LoadInt64(&m.pending))
+	})
+	m.nodeHostGauges = append(m.nodeHostGauges, name)
+	return m
+}
+
+// closed unregisters the NodeHost level gauges.
+func (m *nodeHostMetrics) closed() {
+	if m == nil {
+		return
+	}
+	for _, name := range m.nodeHostGauges {
+		metrics.UnregisterMetric(name)
+	}
+	m.nodeHostGauges = nil
+}
+
+// logDBSaveStarted records the start of saving the specified number of updates
+// to the LogDB, the returned time is expected to be passed to logDBSaved.
+func (m *nodeHostMetrics) logDBSaveStarted(updates int) time.Time {
+	if m == nil || updates == 0 {
+		return time.Time{}
+	}
+	atomic.AddInt64(&m.pending, 1)
+	m.logDBSaveUpdates.Update(float64(updates))
+	return time.Now()
+}
+
+func (m *nodeHostMetrics) logDBSaved(start time.Time) {
+	if m == nil || start.IsZero() {
+		return
+	}
+	atomic.AddInt64(&m.pending, -1)
+	m.logDBSave.UpdateDuration(start)
+}
+
+// engineStarted registers the metrics of all engine workers.
+func (m *nodeHostMetrics) engineStarted(s *engineStats) {
+	if m == nil {
+		return
+	}
+	m.engineWorkers("step", s.step)
+	m.engineWorkers("commit", s.commit)
+	m.engineWorkers("apply", s.apply)
+	m.engineWorkers("snapshot", s.snapshot)
+	m.engineWorkers("close", s.close)
+	gauge := func(name string, f func(s ReadIndexStats) float64) {
+		metrics.UnregisterMetric(name)
+		metrics.GetOrCreateGauge(name, func() float64 { return f(s.reads.get()) })
+		m.engineGauges = append(m.engineGauges, name)
+	}
+	gauge("dragonboat_engine_read_index_rounds",
+		func(s ReadIndexStats) float64 { return float64(s.Rounds) })
+	gauge("dragonboat_engine_read_index_reads",
+		func(s ReadIndexStats) float64 { return float64(s.Reads) })
+}
+
+func (m *nodeHostMetrics) engineWorkers(workerType string,
+	workers []*workerStats) {
+	for _, w := range workers {
+		w := w
+		label := fmt.Sprintf(`type="%s",workerid="%d"`, workerType, w.workerID)
+		gauge := func(name string, f func(s EngineWorkerStats) float64) {
+			name = fmt.Sprintf("%s{%s}", name, label)
+			// gauges of a previously closed NodeHost are replaced
+			metrics.UnregisterMetric(name)
+			metrics.GetOrCreateGauge(name, func() float64 { return f(w.get()) })
+			m.engineGauges = append(m.engineGauges, name)
+		}
+		gauge("dragonboat_engine_worker_busy_seconds",
+			func(s EngineWorkerStats) float64 { return s.Busy.Seconds() })
+		gauge("dragonboat_engine_worker_idle_seconds",
+			func(s EngineWorkerStats) float64 { return s.Idle.Seconds() })
+		gauge("dragonboat_engine_worker_iterations",
+			func(s EngineWorkerStats) float64 { return float64(s.Iterations) })
+		gauge("dragonboat_engine_worker_processed",
+			func(s EngineWorkerStats) float64 { return float64(s.Processed) })
+		gauge("dragonboat_engine_worker_queue_length",
+			func(s EngineWorkerStats) float64 { return float64(s.QueueLength) })
+		if workerType == "step" {
+			gauge("dragonboat_engine_worker_logdb_save_seconds",
+				func(s EngineWorkerStats) float64 { return s.LogDBSave.Seconds() })
+		}
+		w.batchSize = metrics.GetOrCreateHistogram(
+			fmt.Sprintf("dragonboat_engine_worker_batch_size{%s}", label))
+	}
+}
+
+// engineClosed unregisters the gauges of engine workers.
+func (m *nodeHostMetrics) engineClosed() {
+	if m == nil {
+		return
+	}
+	for _, name := range m.engineGauges {
+		metrics.UnregisterMetric(name)
+	}
+	m.engineGauges = nil
+}
+
+// stagingStarted registers the metrics of the snapshot staging space.
+func (m *nodeHostMetrics) stagingStarted(s *server.StagingSpace) {
+	if m == nil {
+		return
+	}
+	gauge := func(name string, f func(s server.StagingStats) float64) {
+		// gauges of a previously closed NodeHost are replaced
+		metrics.UnregisterMetric(name)
+		metrics.GetOrCreateGauge(name, func() float64 { return f(s.Stats()) })
+		m.stagingGauges = append(m.stagingGauges, name)
+	}
+	gauge("dragonboat_snapshot_staging_bytes",
+		func(s server.StagingStats) float64 { return float64(s.Bytes) })
+	gauge("dragonboat_snapshot_staging_limit_bytes",
+		func(s server.StagingStats) float64 { return float64(s.Limit) })
+	gauge("dragonboat_snapshot_staging_deferred",
+		func(s server.StagingStats) float64 { return float64(s.Deferred) })
+}
+
+// stagingClosed unregisters the metrics of the snapshot staging space.
+func (m *nodeHostMetrics) stagingClosed() {
+	if m == nil {
+		return
+	}
+	for _, name := range m.stagingGauges {
+		metrics.UnregisterMetric(name)
+	}
+	m.stagingGauges = nil
+}
+
+// memoryStarted registers the metrics of the memory budget, they are only
+// registered when the memory budget is set.
+func (m *nodeHostMetrics) memoryStarted(a *memoryAccountant) {
+	if m == nil || !a.enabled() {
+		return
+	}
+	gauge := func(name string, f func(s MemoryStats) float64) {
+		metrics.UnregisterMetric(name)
+		metrics.GetOrCreateGauge(name, func() float64 { return f(a.stats()) })
+		m.memoryGauges = append(m.memoryGauges, name)
+	}
+	gauge("dragonboat_memory_budget_bytes",
+		func(s MemoryStats) float64 { return float64(s.Budget) })
+	gauge(`dragonboat_memory_bytes{type="inmem_log"}`,
+		func(s MemoryStats) float64 { return float64(s.InMemLog) })
+	gauge(`dragonboat_memory_bytes{type="pending_proposals"}`,
+		func(s MemoryStats) float64 { return float64(s.PendingProposals) })
+	gauge(`dragonboat_memory_bytes{type="inbound_messages"}`,
+		func(s MemoryStats) float64 { return float64(s.InboundMessages) })
+	gauge(`dragonboat_memory_bytes{type="snapshot_staging"}`,
+		func(s MemoryStats) float64 { return float64(s.SnapshotStaging) })
+	gauge("dragonboat_memory_rejected_proposals",
+		func(s MemoryStats) float64 { return float64(s.Rejected) })
+}
+
+// memoryClosed unregisters the metrics of the memory budget.
+func (m *nodeHostMetrics) memoryClosed() {
+	if m == nil {
+		return
+	}
+	for _, name := range m.memoryGauges {
+		metrics.UnregisterMetric(name)
+	}
+	m.memoryGauges = nil
+}
+
+// tenantMetrics contains the metrics of a tenant. All methods can be invoked
+// on a nil tenantMetrics, nothing is recorded in that case.
+type tenantMetrics struct {
+	proposalBytes *metrics.Counter
+	limited       *metrics.Counter
+}
+
+// newTenantMetrics returns the metrics of the specified tenant. nil is
+// returned when metrics are not enabled. The memory gauge is only registered
+// when the memory budget is set.
+func (m *nodeHostMetrics) newTenantMetrics(t *tenantQuota,
+	a *memoryAccountant) *tenantMetrics {
+	if m == nil {
+		return nil
+	}
+	label := fmt.Sprintf(`tenant=%q`, t.name)
+	gauge := func(name string, f func() float64) {
+		name = fmt.Sprintf("%s{%s}", name, label)
+		metrics.UnregisterMetric(name)
+		metrics.GetOrCreateGauge(name, f)
+		m.mu.Lock()
+		m.tenantGauges = append(m.tenantGauges, name)
+		m.mu.Unlock()
+	}
+	gauge("dragonboat_tenant_snapshot_bytes", func() float64 {
+		return float64(t.snapshot.stats().TotalBytes)
+	})
+	if a.enabled() {
+		gauge("dragonboat_tenant_memory_bytes", func() float64 {
+			return float64(a.stats().Tenants[t.name])
+		})
+	}
+	return &tenantMetrics{
+		proposalBytes: metrics.GetOrCreateCounter(
+			fmt.Sprintf("dragonboat_tenant_proposal_bytes_total{%s}", label)),
+		limited: metrics.GetOrCreateCounter(
+			fmt.Sprintf("dragonboat_tenant_rate_limited_total{%s}", label)),
+	}
+}
+
+// tenantsClosed unregisters the gauges of all tenants.
+func (m *nodeHostMetrics) tenantsClosed() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, name := range m.tenantGauges {
+		metrics.UnregisterMetric(name)
+	}
+	m.tenantGauges = nil
+}
+
+func (m *tenantMetrics) proposalAccepted(sz uint64) {
+	if m != nil {
+		m.proposalBytes.Add(int(sz))
+	}
+}
+
+func (m *tenantMetrics) rateLimited() {
+	if m != nil {
+		m.limited.Inc()
+	}
+}
+
+func (m *nodeHostMetrics) acquire(shardID uint64, replicaID uint64) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.shards[shardID]
+	if !ok && m.maxShards > 0 && uint64(len(m.shards)) >= m.maxShards {
+		return otherShardsLabel, false
+	}
+	m.shards[shardID] = struct{}{}
+	return fmt.Sprintf(`shardid="%d",replicaid="%d"`, shardID, replicaID), true
+}
+
+func (m *nodeHostMetrics) release(shardID uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.shards, shardID)
+}
+
+// newShardMetrics returns the metrics of the specified shard. nil is returned
+// when metrics are not enabled.
+func (m *nodeHostMetrics) newShardMetrics(n *node) *shardMetrics {
+	if m == nil {
+		return nil
+	}
+	label, dedicated := m.acquire(n.shardID, n.replicaID)
+	sm := &shardMetrics{nh: m, shardID: n.shardID, label: label}
+	counter := func(name string) *metrics.Counter {
+		return metrics.GetOrCreateCounter(fmt.Sprintf("%s{%s}", name, label))
+	}
+	failed := func(reason string) *metrics.Counter {
+		name := "dragonboat_raftnode_proposal_failed_total"
+		return metrics.GetOrCreateCounter(
+			fmt.Sprintf(`%s{%s,reason="%s"}`, name, label, reason))
+	}
+	histogram := func(name string) *metrics.Histogram {
+		return metrics.GetOrCreateHistogram(fmt.Sprintf("%s{%s}", name, label))
+	}
+	sm.proposalStarted = counter("dragonboat_raftnode_proposal_started_total")
+	sm.proposalCompleted = counter("dragonboat_raftnode_proposal_completed_total")
+	sm.proposalDropped = failed("dropped")
+	sm.proposalTimeout = failed("timeout")
+	sm.proposalRejected = failed("rejected")
+	sm.proposalTerminated = failed("terminated")
+	sm.readIndex = histogram("dragonboat_raftnode_read_index_seconds")
+	sm.apply = histogram("dragonboat_raftnode_apply_seconds")
+	sm.snapshotSave = histogram("dragonboat_raftnode_snapshot_save_seconds")
+	sm.snapshotSaveSize = histogram("dragonboat_raftnode_snapshot_save_bytes")
+	sm.snapshotStream = histogram("dragonboat_raftnode_snapshot_stream_seconds")
+	sm.snapshotRecover = histogram("dragonboat_raftnode_snapshot_recover_seconds")
+	sm.snapshotRecoverSize = histogram("dragonboat_raftnode_snapshot_recover_bytes")
+	if dedicated {
+		sm.dedicated = true
+		gauge := func(name string, f func() float64) {
+			name = fmt.Sprintf("%s{%s}", name, label)
+			// gauges of a previously stopped replica of the same shard are replaced
+			metrics.UnregisterMetric(name)
+			metrics.GetOrCreateGauge(name, f)
+			sm.gauges = append(sm.gauges, name)
+		}
+		gauge("dragonboat_raftnode_is_leader", func() float64 {
+			if leader, _ := n.raftEvents.isLeader(); leader {
+				return 1.0
+			}
+			return 0.0
+		})
+		gauge("dragonboat_raftnode_applied_index", func() float64 {
+			return float64(n.sm.GetLastApplied())
+		})
+		gauge("dragonboat_raftnode_committed_index", func() float64 {
+			_, committed := n.getLogIndexes()
+			return float64(committed)
+		})
+		gauge("dragonboat_raftnode_last_index", func() float64 {
+			last, _ := n.getLogIndexes()
+			return float64(last)
+		})
+		gauge("dragonboat_raftnode_inmem_log_unapplied_bytes", func() float64 {
+			return float64(n.getInMemLogRetention().Unapplied)
+		})
+		gauge("dragonboat_raftnode_inmem_log_unpersisted_bytes", func() float64 {
+			return float64(n.getInMemLogRetention().Unpersisted)
+		})
+		gauge("dragonboat_raftnode_inmem_log_follower_needed_bytes", func() float64 {
+			return float64(n.getInMemLogRetention().FollowerNeeded)
+		})
+		gauge("dragonboat_raftnode_apply_lag", func() float64 {
+			return float64(atomic.LoadUint64(&n.applyLag))
+		})
+		gauge("dragonboat_raftnode_apply_stall_seconds", func() float64 {
+			return n.getApplyStallDuration().Seconds()
+		})
+		gauge("dragonboat_raftnode_elections_started", func() float64 {
+			return float64(n.getElectionStats().ElectionsStarted)
+		})
+		gauge("dragonboat_raftnode_elections_won", func() float64 {
+			return float64(n.getElectionStats().ElectionsWon)
+		})
+		gauge("dragonboat_raftnode_elections_lost", func() float64 {
+			return float64(n.getElectionStats().ElectionsLost)
+		})
+		gauge("dragonboat_raftnode_prevote_rejections", func() float64 {
+			return float64(n.getElectionStats().PreVoteRejections)
+		})
+		gauge("dragonboat_raftnode_heartbeat_rtt_p99_seconds", func() float64 {
+			return n.getElectionStats().HeartbeatRTTP99.Seconds()
+		})
+		gauge("dragonboat_raftnode_leaderless_p99_seconds", func() float64 {
+			return n.getElectionStats().LeaderlessP99.Seconds()
+		})
+	}
+	return sm
+}
+
+// shardMetrics contains the metrics of a shard. All methods can be invoked on
+// a nil shardMetrics, nothing is recorded in that case.
+type shardMetrics struct {
+	nh                  *nodeHostMetrics
+	proposalStarted     *metrics.Counter
+	proposalCompleted   *metrics.Counter
+	proposalDropped     *metrics.Counter
+	proposalTimeout     *metrics.Counter
+	proposalRejected    *metrics.Counter
+	proposalTerminated  *metrics.Counter
+	readIndex           *metrics.Histogram
+	apply               *metrics.Histogram
+	snapshotSave        *metrics.Histogram
+	snapshotSaveSize    *metrics.Histogram
+	snapshotStream      *metrics.Histogram
+	snapshotRecover     *metrics.Histogram
+	snapshotRecoverSize *metrics.Histogram
+	gauges              []string
+	label               string
+	shardID             uint64
+	closeOnce           sync.Once
+	dedicated           bool
+}
+
+func (m *shardMetrics) close() {
+	if m == nil {
+		return
+	}
+	m.closeOnce.Do(func() {
+		for _, name := range m.gauges {
+			metrics.UnregisterMetric(name)
+		}
+		if m.dedicated {
+			m.nh.release(m.shardID)
+		}
+	})
+}
+
+func (m *shardMetrics) now() time.Time {
+	if m == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (m *shardMetrics) proposalAdded() {
+	if m != nil {
+		m.proposalStarted.Inc()
+	}
+}
+
+func (m *shardMetrics) proposalDone(code RequestResultCode, count int) {
+	if m == nil || count == 0 {
+		return
+	}
+	switch code {
+	case requestCompleted:
+		m.proposalCompleted.Add(count)
+	case requestDropped:
+		m.proposalDropped.Add(count)
+	case requestTimeout:
+		m.proposalTimeout.Add(count)
+	case requestRejected:
+		m.proposalRejected.Add(count)
+	case requestTerminated:
+		m.proposalTerminated.Add(count)
+	}
+}
+
+// requestFailed counts a failed request of the specified type, counters are
+// labeled by the returned error as failures are expected to be rare.
+func (m *shardMetrics) requestFailed(t PendingRequestType, err error) {
+	if m != nil {
+		name := "dragonboat_raftnode_request_failed_total"
+		metrics.GetOrCreateCounter(fmt.Sprintf(`%s{%s,type="%s",error=%q}`,
+			name, m.label, t, err.Error())).Inc()
+	}
+}
+
+func (m *shardMetrics) requestCompletedLate(t PendingRequestType) {
+	if m != nil {
+		name := "dragonboat_raftnode_request_late_total"
+		metrics.GetOrCreateCounter(fmt.Sprintf(`%s{%s,type="%s"}`,
+			name, m.label, t)).Inc()
+	}
+}
+
+func (m *shardMetrics) readIndexDone(start time.Time) {
+	if m != nil && !start.IsZero() {
+		m.readIndex.UpdateDuration(start)
+	}
+}
+
+func (m *shardMetrics) applied(start time.Time) {
+	if m != nil && !start.IsZero() {
+		m.apply.UpdateDuration(start)
+	}
+}
+
+func (m *shardMetrics) snapshotSaved(start time.Time, size uint64) {
+	if m != nil {
+		m.snapshotSave.UpdateDuration(start)
+		m.snapshotSaveSize.Update(float64(size))
+	}
+}
+
+func (m *shardMetrics) snapshotStreamed(start time.Time) {
+	if m != nil {
+		m.snapshotStream.UpdateDuration(start)
+	}
+}
+
+func (m *shardMetrics) snapshotRecovered(start time.Time, size uint64) {
+	if m != nil {
+		m.snapshotRecover.UpdateDuration(start)
+		m.snapshotRecoverSize.Update(float64(size))
+	}
+}
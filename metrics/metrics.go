@@ -0,0 +1,61 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package metrics exposes Dragonboat metrics in Prometheus format.
+
+Metrics are collected by NodeHost instances with NodeHostConfig.EnableMetrics
+set. Per shard series are labeled with shardid and replicaid, they include
+
+	dragonboat_raftnode_proposal_started_total
+	dragonboat_raftnode_proposal_completed_total
+	dragonboat_raftnode_proposal_failed_total{reason="..."}
+	dragonboat_raftnode_read_index_seconds
+	dragonboat_raftnode_apply_seconds
+	dragonboat_raftnode_snapshot_save_seconds
+	dragonboat_raftnode_snapshot_save_bytes
+	dragonboat_raftnode_snapshot_stream_seconds
+	dragonboat_raftnode_snapshot_recover_seconds
+	dragonboat_raftnode_snapshot_recover_bytes
+	dragonboat_raftnode_is_leader
+	dragonboat_raftnode_applied_index
+	dragonboat_raftnode_committed_index
+	dragonboat_raftnode_last_index
+
+Shards started after NodeHostConfig.MaxMetricsShards shards already have their
+own series share the series labeled with shardid="other", gauges are not
+available for such shards. NodeHost level series include
+
+	dragonboat_logdb_save_seconds
+	dragonboat_logdb_save_updates
+	dragonboat_logdb_pending_saves
+	dragonboat_transport_sent_bytes_total{target="..."}
+	dragonboat_transport_received_bytes_total{source="..."}
+*/
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Handler returns an http.Handler that writes all Dragonboat metrics in
+// Prometheus format, it is typically registered at the /metrics path.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.WritePrometheus(w, false)
+	})
+}
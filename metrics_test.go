@@ -0,0 +1,234 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/tests"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/metrics"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	result := make(map[string]float64)
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		idx := strings.LastIndex(line, " ")
+		if idx < 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[idx+1:], 64)
+		if err != nil {
+			t.Fatalf("failed to parse %s, %v", line, err)
+		}
+		result[line[:idx]] = v
+	}
+	return result
+}
+
+func getMetricsTestNodeHost(t *testing.T, fs vfs.IFS,
+	replicaID uint64, addr string) *NodeHost {
+	dir := fs.PathJoin(singleNodeHostTestDir, fmt.Sprintf("nh%d", replicaID))
+	nhc := config.NodeHostConfig{
+		NodeHostDir:      dir,
+		RTTMillisecond:   getRTTMillisecond(fs, dir),
+		RaftAddress:      addr,
+		Expert:           getTestExpertConfig(fs),
+		EnableMetrics:    true,
+		MaxMetricsShards: 1,
+	}
+	nh, err := NewNodeHost(nhc)
+	if err != nil {
+		t.Fatalf("failed to create node host %v", err)
+	}
+	return nh
+}
+
+func TestMetricsCanBeScraped(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		peers := map[uint64]string{1: nodeHostTestAddr1, 2: nodeHostTestAddr2}
+		newSM := func(uint64, uint64) sm.IStateMachine {
+			return &tests.NoOP{}
+		}
+		nhList := make([]*NodeHost, 0)
+		defer func() {
+			for _, nh := range nhList {
+				nh.Close()
+			}
+		}()
+		for _, replicaID := range []uint64{1, 2} {
+			nh := getMetricsTestNodeHost(t, fs, replicaID, peers[replicaID])
+			nhList = append(nhList, nh)
+			rc := config.Config{
+				ShardID:      1,
+				ReplicaID:    replicaID,
+				ElectionRTT:  10,
+				HeartbeatRTT: 1,
+				CheckQuorum:  true,
+			}
+			if err := nh.StartReplica(peers, false, newSM, rc); err != nil {
+				t.Fatalf("failed to start shard %v", err)
+			}
+		}
+		nh1 := nhList[0]
+		// shard 2 exceeds the MaxMetricsShards limit of nh1
+		rc := config.Config{
+			ShardID:      2,
+			ReplicaID:    1,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+		}
+		members := map[uint64]string{1: nodeHostTestAddr1}
+		if err := nh1.StartReplica(members, false, newSM, rc); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		waitForLeaderToBeElected(t, nh1, 1)
+		waitForLeaderToBeElected(t, nh1, 2)
+		// leadership is reported to the local NodeHost asynchronously
+		var leader *NodeHost
+		replicaID := uint64(0)
+		for i := 0; i < 100 && leader == nil; i++ {
+			for idx, nh := range nhList {
+				if l, _ := nh.IsLeader(1); l {
+					leader, replicaID = nh, uint64(idx+1)
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if leader == nil {
+			t.Fatalf("leader not reported")
+		}
+		label := fmt.Sprintf(`{shardid="1",replicaid="%d"}`, replicaID)
+		started := "dragonboat_raftnode_proposal_started_total" + label
+		completed := "dragonboat_raftnode_proposal_completed_total" + label
+		applied := "dragonboat_raftnode_applied_index" + label
+		readIndex := "dragonboat_raftnode_read_index_seconds_count" + label
+		save := "dragonboat_raftnode_snapshot_save_seconds_count" + label
+		other := `dragonboat_raftnode_proposal_started_total{shardid="other"}`
+		before := scrapeMetrics(t)
+		for _, name := range []string{started, completed, applied,
+			"dragonboat_raftnode_is_leader" + label,
+			"dragonboat_raftnode_committed_index" + label,
+			"dragonboat_raftnode_last_index" + label,
+			"dragonboat_raftnode_apply_lag" + label,
+			"dragonboat_raftnode_apply_stall_seconds" + label,
+			"dragonboat_raftnode_elections_started" + label,
+			"dragonboat_raftnode_heartbeat_rtt_p99_seconds" + label,
+			"dragonboat_logdb_save_seconds_count",
+			"dragonboat_logdb_pending_saves",
+			`dragonboat_engine_worker_busy_seconds{type="step",workerid="1"}`,
+			`dragonboat_engine_worker_logdb_save_seconds{type="step",workerid="1"}`,
+			`dragonboat_engine_worker_queue_length{type="apply",workerid="1"}`,
+			`dragonboat_engine_worker_batch_size_count{type="apply",workerid="1"}`,
+			"dragonboat_snapshot_staging_bytes",
+			"dragonboat_snapshot_staging_limit_bytes",
+			other,
+			fmt.Sprintf(`dragonboat_transport_sent_bytes_total{target="%s"}`,
+				nodeHostTestAddr2),
+			fmt.Sprintf(`dragonboat_transport_received_bytes_total{source="%s"}`,
+				nodeHostTestAddr1),
+		} {
+			if _, ok := before[name]; !ok {
+				t.Errorf("series %s not found", name)
+			}
+		}
+		if before["dragonboat_raftnode_is_leader"+label] != 1.0 {
+			t.Errorf("leader flag not set")
+		}
+		if _, ok := before[`dragonboat_raftnode_is_leader{shardid="other"}`]; ok {
+			t.Errorf("gauge unexpectedly available for aggregated shards")
+		}
+		makeProposals(leader)
+		ctx, cancel := context.WithTimeout(context.Background(), pto(leader))
+		defer cancel()
+		if _, err := leader.SyncRead(ctx, 1, nil); err != nil {
+			t.Fatalf("failed to read, %v", err)
+		}
+		if _, err := leader.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption); err != nil {
+			t.Fatalf("failed to request snapshot, %v", err)
+		}
+		session := nh1.GetNoOPSession(2)
+		if _, err := nh1.SyncPropose(ctx, session, []byte("test-data")); err != nil {
+			t.Fatalf("failed to make proposal, %v", err)
+		}
+		// the applied index gauge is updated asynchronously
+		time.Sleep(100 * time.Millisecond)
+		after := scrapeMetrics(t)
+		for _, name := range []string{started, completed, applied,
+			readIndex, save, other} {
+			if after[name] <= before[name] {
+				t.Errorf("series %s didn't move, %f, %f",
+					name, before[name], after[name])
+			}
+		}
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
+func TestShardsBeyondMetricsLimitAreAggregated(t *testing.T) {
+	m := newNodeHostMetrics(true, 2)
+	for shardID := uint64(1); shardID <= 2; shardID++ {
+		label, dedicated := m.acquire(shardID, 1)
+		if !dedicated || label != fmt.Sprintf(`shardid="%d",replicaid="1"`, shardID) {
+			t.Errorf("unexpected label %s", label)
+		}
+	}
+	if label, dedicated := m.acquire(3, 1); dedicated || label != otherShardsLabel {
+		t.Errorf("unexpected label %s", label)
+	}
+	if _, dedicated := m.acquire(1, 1); !dedicated {
+		t.Errorf("shard lost its dedicated series")
+	}
+	m.release(1)
+	if _, dedicated := m.acquire(3, 1); !dedicated {
+		t.Errorf("released slot not reused")
+	}
+	if newNodeHostMetrics(false, 0) != nil {
+		t.Errorf("metrics unexpectedly enabled")
+	}
+}
+
+func TestNodeHostGaugesAreUnregisteredOnClose(t *testing.T) {
+	name := "dragonboat_logdb_pending_saves"
+	m1 := newNodeHostMetrics(true, 0)
+	m1.logDBSaveStarted(1)
+	if v, ok := scrapeMetrics(t)[name]; !ok || v != 1.0 {
+		t.Errorf("unexpected pending saves %f", v)
+	}
+	// the gauge of m1 is replaced by the one of m2
+	m2 := newNodeHostMetrics(true, 0)
+	if v := scrapeMetrics(t)[name]; v != 0 {
+		t.Errorf("stale gauge not replaced, %f", v)
+	}
+	m1.closed()
+	m2.closed()
+	if _, ok := scrapeMetrics(t)[name]; ok {
+		t.Errorf("gauge not unregistered")
+	}
+}
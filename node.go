@@ -15,8 +15,13 @@
 package dragonboat
 
 import (
+	"context"
+	"math"
+	"runtime/pprof"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/lni/goutils/logutil"
@@ -24,12 +29,14 @@ import (
 	"github.com/lni/dragonboat/v4/client"
 	"github.com/lni/dragonboat/v4/config"
 	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/invariants"
 	"github.com/lni/dragonboat/v4/internal/logdb"
 	"github.com/lni/dragonboat/v4/internal/raft"
 	"github.com/lni/dragonboat/v4/internal/rsm"
 	"github.com/lni/dragonboat/v4/internal/server"
 	"github.com/lni/dragonboat/v4/internal/settings"
 	"github.com/lni/dragonboat/v4/internal/transport"
+	"github.com/lni/dragonboat/v4/logger"
 	"github.com/lni/dragonboat/v4/raftio"
 	pb "github.com/lni/dragonboat/v4/raftpb"
 	sm "github.com/lni/dragonboat/v4/statemachine"
@@ -45,6 +52,7 @@ var (
 type pipeline interface {
 	setCloseReady(*node)
 	setStepReady(shardID uint64)
+	setStepReadyDeferred(shardID uint64)
 	setCommitReady(shardID uint64)
 	setApplyReady(shardID uint64)
 	setStreamReady(shardID uint64)
@@ -73,36 +81,70 @@ type leaderInfo struct {
 	term     uint64
 }
 
+type snapshotReceiveInfo struct {
+	received uint64
+	total    uint64
+}
+
 type node struct {
 	shardInfo             atomic.Value
 	leaderInfo            atomic.Value
+	leaderContact         atomic.Value
+	snapshotReceiveInfo   atomic.Value
+	retired               atomic.Value
 	nodeRegistry          raftio.INodeRegistry
 	logdb                 raftio.ILogDB
 	pipeline              pipeline
 	getStreamSink         func(uint64, uint64) *transport.Sink
 	ss                    snapshotState
+	clock                 func() time.Time
+	ticker                *tickScheduler
+	memory                *memoryAccountant
+	tenant                *tenantQuota
 	configChangeC         <-chan configChangeRequest
 	snapshotC             <-chan rsm.SSRequest
+	quiesceC              chan quiesceRequest
 	toApplyQ              *rsm.TaskQueue
 	toCommitQ             *rsm.TaskQueue
 	syncTask              task
 	metrics               *logDBMetrics
+	shardMetrics          *shardMetrics
+	errorStats            *errorStats
+	appliedTails          appliedTails
+	profilerLabels        pprof.LabelSet
+	slowOps               *slowOpDetector
+	degraded              *degradedLeaderDetector
+	tracer                *nodeTracer
 	stopC                 chan struct{}
 	sysEvents             *sysEventListener
+	membershipQ           *membershipChangeQueue
 	raftEvents            *raftEventListener
 	handleSnapshotStatus  func(uint64, uint64, bool)
 	sendRaftMessage       func(pb.Message)
+	removeConnections     func(string)
+	bootstrapMismatches   sync.Map
+	retiredSources        sync.Map
+	peerVersions          sync.Map
 	validateTarget        func(string) bool
 	sm                    *rsm.StateMachine
+	standby               *standbyState
+	createSM              rsm.ManagedStateMachineFactory
 	incomingReadIndexes   *readIndexQueue
 	incomingProposals     *entryQueue
 	snapshotLock          sync.Mutex
 	pendingProposals      pendingProposal
 	pendingReadIndexes    pendingReadIndex
 	pendingConfigChange   pendingConfigChange
+	jointKey              uint64
 	pendingSnapshot       pendingSnapshot
 	pendingLeaderTransfer pendingLeaderTransfer
 	pendingRaftLogQuery   pendingRaftLogQuery
+	pendingRaftStateDump  pendingRaftStateDump
+	leaderExport          leaderExport
+	laggards              laggardTracker
+	retainedCompactions   []retainedCompaction
+	fingerprints          fingerprintHistory
+	unsafeRecovery        UnsafeRecoveryDump
 	initializedC          chan struct{}
 	p                     raft.Peer
 	logReader             *logdb.LogReader
@@ -113,20 +155,48 @@ type node struct {
 	config                config.Config
 	currentTick           uint64
 	gcTick                uint64
+	applyProgressTick     uint64
+	applyProgressIndex    uint64
+	applyLag              uint64
+	ssQueuePosition       uint64
+	applyStallSince       int64
+	freshAt               int64
+	applyStallThreshold   time.Duration
+	applyStallReported    bool
+	logRetentionReported  bool
+	membershipSSIndex     uint64
+	membershipSSDecision  uint32
+	membershipSSPending   uint32
 	appliedIndex          uint64
+	committedIndex        uint64
+	recoveredIndex        uint64
+	replayedIndex         uint64
+	replayedFlag          uint32
+	removedIndex          uint64
+	witnessIndex          uint64
+	bootstrapHash         uint64
+	electionTimeout       uint64
+	heartbeatInterval     uint64
 	pushedIndex           uint64
 	confirmedIndex        uint64
+	compactTo             uint64
+	reclaimIndex          uint64
 	tickMillisecond       uint64
 	shardID               uint64
 	replicaID             uint64
 	instanceID            uint64
 	initializedFlag       uint64
+	diskFull              uint32
+	idleTicking           uint32
+	lastTick              uint64
+	proposalBatchWaiting  uint32
 	closeOnce             sync.Once
 	raftMu                sync.Mutex
 	new                   bool
 	logDBLimited          bool
 	rateLimited           bool
 	notifyCommit          bool
+	readOnlyMode          bool
 }
 
 var _ rsm.INode = (*node)(nil)
@@ -142,6 +212,7 @@ func newNode(peers map[uint64]string,
 	logReader *logdb.LogReader,
 	pipeline pipeline,
 	liQueue *leaderInfoQueue,
+	mcQueue *membershipChangeQueue,
 	getStreamSink func(uint64, uint64) *transport.Sink,
 	handleSnapshotStatus func(uint64, uint64, bool),
 	sendMessage func(pb.Message),
@@ -169,6 +240,7 @@ func newNode(peers map[uint64]string,
 		incomingReadIndexes:   readIndexes,
 		configChangeC:         configChangeC,
 		snapshotC:             snapshotC,
+		quiesceC:              make(chan quiesceRequest, 1),
 		pipeline:              pipeline,
 		getStreamSink:         getStreamSink,
 		handleSnapshotStatus:  handleSnapshotStatus,
@@ -179,6 +251,7 @@ func newNode(peers map[uint64]string,
 		pendingSnapshot:       newPendingSnapshot(snapshotC),
 		pendingLeaderTransfer: newPendingLeaderTransfer(),
 		pendingRaftLogQuery:   newPendingRaftLogQuery(),
+		pendingRaftStateDump:  newPendingRaftStateDump(),
 		nodeRegistry:          nodeRegistry,
 		snapshotter:           snapshotter,
 		logReader:             logReader,
@@ -187,16 +260,25 @@ func newNode(peers map[uint64]string,
 		logdb:                 ldb,
 		syncTask:              newTask(syncTaskInterval),
 		sysEvents:             sysEvents,
+		slowOps:               newSlowOpDetector(config, nhConfig, sysEvents),
+		degraded:              newDegradedLeaderDetector(config),
+		applyStallThreshold:   nhConfig.ApplyStallThreshold,
+		membershipQ:           mcQueue,
 		notifyCommit:          notifyCommit,
+		readOnlyMode:          nhConfig.ReadOnlyMode,
 		metrics:               metrics,
 		initializedC:          make(chan struct{}),
 		ss:                    snapshotState{},
+		clock:                 time.Now,
 		validateTarget:        nhConfig.GetTargetValidator(),
+		bootstrapHash:         getBootstrapHash(peers, initialMember, config.WriteFsyncMode),
 		qs: &quiesceState{
-			electionTick: config.ElectionRTT * 2,
-			enabled:      config.Quiesce,
-			shardID:      config.ShardID,
-			replicaID:    config.ReplicaID,
+			events:        sysEvents,
+			electionTick:  config.ElectionRTT * 2,
+			idleThreshold: config.QuiesceThreshold,
+			enabled:       config.Quiesce,
+			shardID:       config.ShardID,
+			replicaID:     config.ReplicaID,
 		},
 	}
 	ds := createSM(config.ShardID, config.ReplicaID, stopC)
@@ -206,8 +288,25 @@ func newNode(peers map[uint64]string,
 	}
 	rn.toApplyQ = sm.TaskQ()
 	rn.sm = sm
+	rn.electionTimeout, rn.heartbeatInterval =
+		getTimings(config, nhConfig.RTTMillisecond)
+	rn.tracer = newNodeTracer(nhConfig.TracerProvider, config)
+	rn.pendingProposals.setTracer(rn.tracer)
+	rn.pendingReadIndexes.tracer = rn.tracer
+	rn.pendingReadIndexes.batchDelay = nhConfig.Expert.Engine.ReadBatchDelay
+	ec := nhConfig.Expert.Engine
+	rn.incomingProposals.batchDelay =
+		time.Duration(ec.ProposalBatchDelayMicroseconds) * time.Microsecond
+	rn.incomingProposals.batchMaxBytes = ec.ProposalBatchMaxBytes
+	rn.incomingProposals.batchMaxCount = ec.ProposalBatchMaxCount
+	rn.profilerLabels = getShardProfilerLabels(config.ShardID, config.ReplicaID)
+	rn.errorStats = newErrorStats()
+	rn.pendingProposals.setErrorStats(&rn.errorStats.proposals)
+	rn.pendingReadIndexes.stats = &rn.errorStats.reads
+	rn.pendingConfigChange.stats = &rn.errorStats.configChanges
+	rn.pendingSnapshot.stats = &rn.errorStats.snapshots
 	rn.raftEvents = newRaftEventListener(config.ShardID,
-		config.ReplicaID, nhConfig.EnableMetrics, liQueue)
+		config.ReplicaID, nhConfig.EnableMetrics, liQueue, sysEvents)
 	new, err := rn.startRaft(config, peers, initialMember)
 	if err != nil {
 		return nil, err
@@ -228,8 +327,10 @@ func (n *node) ShouldStop() <-chan struct{} {
 	return n.stopC
 }
 
+// StepReady is called by the apply worker once tasks have been applied, the
+// step worker is woken up when the apply worker finishes its iteration.
 func (n *node) StepReady() {
-	n.pipeline.setStepReady(n.shardID)
+	n.pipeline.setStepReadyDeferred(n.shardID)
 }
 
 func (n *node) applyReady() {
@@ -252,18 +353,50 @@ func (n *node) ApplyUpdate(e pb.Entry,
 		if e.Key == 0 {
 			plog.Panicf("key is 0")
 		}
+		if n.tracer.active() {
+			n.pendingProposals.traceEvent(appliedEventName, e)
+		}
+		// the entry can be applied before the update committing it is processed
+		n.pendingProposals.setStage(e, RequestAwaitingApply)
 		n.pendingProposals.applied(e.ClientID, e.SeriesID, e.Key, result, rejected)
 	}
 }
 
 func (n *node) ApplyConfigChange(cc pb.ConfigChange,
-	key uint64, rejected bool) error {
+	key uint64, rejected bool, reason error) error {
 	n.raftMu.Lock()
 	defer n.raftMu.Unlock()
 	if !rejected {
 		if err := n.applyConfigChange(cc); err != nil {
 			return err
 		}
+		n.notifyMembershipChange(cc)
+		n.membershipChanged()
+		// the reconfigure request is completed once the shard left the joint
+		// config, the replace request is completed once it entered it
+		if cc.Type == pb.EnterJoint {
+			if n.pendingConfigChange.isEnterJoint(key) {
+				return n.configChangeProcessed(key, rejected)
+			}
+			n.jointKey = key
+			return n.configChangeProcessed(0, rejected)
+		} else if cc.Type == pb.LeaveJoint {
+			key, n.jointKey = n.jointKey, 0
+		}
+	} else if len(cc.Inactive) > 0 {
+		n.pendingConfigChange.rejectUnsafe(key, cc.Inactive)
+	} else if cc.LimitExceeded {
+		err := ErrTooManyWitnesses
+		if cc.Type == pb.AddNonVoting {
+			err = ErrTooManyNonVotings
+		}
+		n.pendingConfigChange.rejectWithError(key, err)
+	} else if errors.Is(reason, rsm.ErrReplicaIDReused) {
+		n.pendingConfigChange.rejectWithError(key, ErrReplicaIDReused)
+	} else if errors.Is(reason, rsm.ErrAddressInUse) {
+		n.pendingConfigChange.rejectWithError(key, ErrAddressInUse)
+	} else if errors.Is(reason, rsm.ErrMembershipTooLarge) {
+		n.pendingConfigChange.rejectWithError(key, ErrMembershipTooLarge)
 	}
 	return n.configChangeProcessed(key, rejected)
 }
@@ -279,17 +412,73 @@ func (n *node) applyConfigChange(cc pb.ConfigChange) error {
 		if cc.ReplicaID == n.replicaID {
 			plog.Infof("%s applied ConfChange Remove for itself", n.id())
 			n.nodeRegistry.RemoveShard(n.shardID)
-			n.requestRemoval()
-			n.notifySelfRemove()
+			n.selfRemoved(n.sm.GetMembership().ConfigChangeId)
 		} else {
 			n.nodeRegistry.Remove(n.shardID, cc.ReplicaID)
 		}
+	case pb.UpdateAddress:
+		if cc.ReplicaID != n.replicaID {
+			addr, _, err := n.nodeRegistry.Resolve(n.shardID, cc.ReplicaID)
+			n.nodeRegistry.Remove(n.shardID, cc.ReplicaID)
+			n.nodeRegistry.Add(n.shardID, cc.ReplicaID, cc.Address)
+			// cached connections to the old address are dropped so messages are
+			// sent to the new address right away
+			if err == nil && n.removeConnections != nil {
+				n.removeConnections(addr)
+			}
+		}
+		n.setRetired(n.sm.GetMembership().Retired)
+	case pb.ReplaceWitness:
+		if cc.ReplacedID == n.replicaID {
+			plog.Infof("%s applied ConfChange ReplaceWitness for itself", n.id())
+			n.nodeRegistry.RemoveShard(n.shardID)
+			n.selfRemoved(n.sm.GetMembership().ConfigChangeId)
+		} else {
+			n.nodeRegistry.Remove(n.shardID, cc.ReplacedID)
+			n.nodeRegistry.Add(n.shardID, cc.ReplicaID, cc.Address)
+		}
+	case pb.PromoteWitness:
+		if cc.ReplicaID == n.replicaID {
+			plog.Infof("%s applied ConfChange PromoteWitness for itself", n.id())
+			if err := n.markPromoted(); err != nil {
+				return err
+			}
+			n.requestRemoval()
+		}
+	case pb.EnterJoint:
+		for nid, addr := range cc.Members {
+			n.nodeRegistry.Add(n.shardID, nid, addr)
+		}
+	case pb.LeaveJoint:
+		for nid := range cc.Members {
+			if nid == n.replicaID {
+				plog.Infof("%s applied ConfChange LeaveJoint for itself", n.id())
+				n.nodeRegistry.RemoveShard(n.shardID)
+				n.selfRemoved(n.sm.GetMembership().ConfigChangeId)
+				return nil
+			}
+		}
+		for nid := range cc.Members {
+			n.nodeRegistry.Remove(n.shardID, nid)
+		}
 	default:
 		plog.Panicf("unknown config change type, %s", cc.Type)
 	}
 	return nil
 }
 
+// markPromoted records in the bootstrap info that the local witness has been
+// promoted to a regular node. The witness has no state machine data, its local
+// data is dropped when it is restarted as a regular node.
+func (n *node) markPromoted() error {
+	bi, err := n.logdb.GetBootstrapInfo(n.shardID, n.replicaID)
+	if err != nil {
+		return err
+	}
+	bi.Promoted = true
+	return n.logdb.SaveBootstrapInfo(n.shardID, n.replicaID, bi)
+}
+
 func (n *node) configChangeProcessed(key uint64, rejected bool) error {
 	if n.isWitness() {
 		return nil
@@ -338,6 +527,14 @@ func (n *node) RestoreRemotes(snapshot pb.Snapshot) error {
 	}
 	n.raftMu.Lock()
 	defer n.raftMu.Unlock()
+	// remotes that changed their addresses are registered again with their
+	// current addresses
+	for _, nid := range snapshot.Membership.Retired {
+		if nid != n.replicaID {
+			n.nodeRegistry.Remove(n.shardID, nid)
+		}
+	}
+	n.setRetired(snapshot.Membership.Retired)
 	for nid, addr := range snapshot.Membership.Addresses {
 		n.nodeRegistry.Add(n.shardID, nid, addr)
 	}
@@ -347,12 +544,13 @@ func (n *node) RestoreRemotes(snapshot pb.Snapshot) error {
 	for nid, addr := range snapshot.Membership.Witnesses {
 		n.nodeRegistry.Add(n.shardID, nid, addr)
 	}
-	for nid := range snapshot.Membership.Removed {
-		if nid == n.replicaID {
-			n.nodeRegistry.RemoveShard(n.shardID)
-			n.requestRemoval()
-			n.notifySelfRemove()
-		}
+	for nid, addr := range snapshot.Membership.Outgoing {
+		n.nodeRegistry.Add(n.shardID, nid, addr)
+	}
+	if snapshot.Membership.IsRemoved(n.replicaID) {
+		plog.Infof("%s recovered from a snapshot with itself removed", n.id())
+		n.nodeRegistry.RemoveShard(n.shardID)
+		n.selfRemoved(snapshot.Membership.ConfigChangeId)
 	}
 	plog.Debugf("%s is restoring remotes", n.id())
 	if err := n.p.RestoreRemotes(snapshot); err != nil {
@@ -373,12 +571,44 @@ func (n *node) startRaft(cfg config.Config,
 		pas = append(pas, raft.PeerAddress{ReplicaID: k, Address: v})
 	}
 	n.p = raft.Launch(cfg, n.logReader, n.raftEvents, pas, initial, newNode)
+	if n.readOnlyMode {
+		n.p.DisableCampaign()
+	}
+	if _, last := n.logReader.GetRange(); last < n.witnessIndex {
+		// promoted witness, entries acknowledged by the witness are yet to be
+		// received from the leader
+		plog.Infof("%s log not caught up with its witness log, last %d, witness %d",
+			n.id(), last, n.witnessIndex)
+		n.p.SetLogLost()
+	}
+	if cfg.MaxCatchupBytesPerSecond > 0 {
+		n.p.SetCatchupRate(getCatchupBytesPerTick(cfg.MaxCatchupBytesPerSecond,
+			n.tickMillisecond))
+	}
 	return newNode, nil
 }
 
+// getCatchupBytesPerTick returns the number of bytes that can be replicated to
+// each peer catching up per tick, it is never 0.
+func getCatchupBytesPerTick(bytesPerSecond uint64,
+	tickMillisecond uint64) uint64 {
+	if v := bytesPerSecond * tickMillisecond / 1000; v > 0 {
+		return v
+	}
+	return 1
+}
+
+func (n *node) setMetrics(m *shardMetrics) {
+	n.shardMetrics = m
+	n.pendingProposals.setMetrics(m)
+	n.errorStats.setMetrics(m)
+	n.pendingReadIndexes.metrics = m
+}
+
 func (n *node) close() {
 	n.requestRemoval()
 	n.raftEvents.close()
+	n.shardMetrics.close()
 	n.mq.Close()
 	n.pendingReadIndexes.close()
 	n.pendingProposals.close()
@@ -415,22 +645,60 @@ func (n *node) isWitness() bool {
 	return n.config.IsWitness
 }
 
+// isWitnessReplica returns a boolean value indicating whether the specified
+// replica is a witness according to the applied membership.
+func (n *node) isWitnessReplica(replicaID uint64) bool {
+	_, ok := n.sm.GetMembership().Witnesses[replicaID]
+	return ok
+}
+
 func (n *node) OnDiskStateMachine() bool {
 	return n.sm.OnDiskStateMachine()
 }
 
 func (n *node) proposeSession(session *client.Session,
-	timeout uint64) (*RequestState, error) {
-	if !n.initialized() {
+	timeout uint64) (rs *RequestState, err error) {
+	defer n.requestSubmitted(PendingProposal, &err)
+	if !n.ready() {
 		return nil, ErrShardNotReady
 	}
-	if n.isWitness() {
+	if n.isWitness() || n.isStandby() {
 		return nil, ErrInvalidOperation
 	}
+	if n.readOnlyMode {
+		return nil, ErrReadOnlyNodeHost
+	}
 	if !session.ValidForSessionOp(n.shardID) {
 		return nil, ErrInvalidSession
 	}
-	return n.pendingProposals.propose(session, nil, timeout)
+	if n.isDiskFull() {
+		return nil, ErrDiskFull
+	}
+	return n.pendingProposals.propose(context.Background(), session, nil, timeout)
+}
+
+// proposeBarrier proposes an empty entry not managed by any client session,
+// such barrier entry is applied without being passed to the state machine.
+func (n *node) proposeBarrier(timeout uint64) (rs *RequestState, err error) {
+	defer n.requestSubmitted(PendingProposal, &err)
+	if !n.ready() {
+		return nil, ErrShardNotReady
+	}
+	if n.isWitness() || n.isStandby() {
+		return nil, ErrInvalidOperation
+	}
+	if n.readOnlyMode {
+		return nil, ErrReadOnlyNodeHost
+	}
+	if n.isDiskFull() {
+		return nil, ErrDiskFull
+	}
+	session := &client.Session{
+		ShardID:  n.shardID,
+		ClientID: client.NotSessionManagedClientID,
+		SeriesID: client.NoOPSeriesID,
+	}
+	return n.pendingProposals.propose(context.Background(), session, nil, timeout)
 }
 
 func (n *node) payloadTooBig(sz int) bool {
@@ -440,65 +708,148 @@ func (n *node) payloadTooBig(sz int) bool {
 	return uint64(sz+settings.EntryNonCmdFieldsSize) > n.config.MaxInMemLogSize
 }
 
-func (n *node) propose(session *client.Session,
-	cmd []byte, timeout uint64) (*RequestState, error) {
-	if !n.initialized() {
-		return nil, ErrShardNotReady
+// chunked returns a boolean value indicating whether the proposal with the
+// specified payload size is to be proposed as a chunked proposal, see
+// config.Config.MaxEntryChunkBytes.
+func (n *node) chunked(sz int) bool {
+	return n.config.MaxEntryChunkBytes > 0 &&
+		uint64(sz) > n.config.MaxEntryChunkBytes
+}
+
+func (n *node) propose(ctx context.Context, session *client.Session,
+	cmd []byte, timeout uint64) (rs *RequestState, err error) {
+	defer n.requestSubmitted(PendingProposal, &err)
+	if err := n.admitProposal(session, len(cmd)); err != nil {
+		return nil, err
 	}
-	if n.isWitness() {
-		return nil, ErrInvalidOperation
+	return n.pendingProposals.propose(ctx, session, cmd, timeout)
+}
+
+// proposeEncoded proposes the already encoded chunk or manifest entry Cmd of a
+// chunked proposal.
+func (n *node) proposeEncoded(ctx context.Context, session *client.Session,
+	encoded []byte, timeout uint64) (rs *RequestState, err error) {
+	defer n.requestSubmitted(PendingProposal, &err)
+	if err := n.admitProposal(session, len(encoded)); err != nil {
+		return nil, err
+	}
+	return n.pendingProposals.proposeEncoded(ctx, session, encoded, timeout)
+}
+
+func (n *node) admitProposal(session *client.Session, sz int) error {
+	if n.removed() {
+		return ErrReplicaRemoved
+	}
+	if !n.ready() {
+		return ErrShardNotReady
+	}
+	if n.isWitness() || n.isStandby() {
+		return ErrInvalidOperation
+	}
+	if n.readOnlyMode {
+		return ErrReadOnlyNodeHost
 	}
 	if !session.ValidForProposal(n.shardID) {
-		return nil, ErrInvalidSession
+		return ErrInvalidSession
+	}
+	if n.payloadTooBig(sz) {
+		return ErrPayloadTooBig
 	}
-	if n.payloadTooBig(len(cmd)) {
-		return nil, ErrPayloadTooBig
+	if n.isDiskFull() {
+		return ErrDiskFull
 	}
-	return n.pendingProposals.propose(session, cmd, timeout)
+	if !n.tenant.admit(uint64(sz)) {
+		return ErrRateLimited
+	}
+	if !n.memory.admit(n.shardID, uint64(sz)+entryInMemSize) {
+		return ErrSystemBusy
+	}
+	return nil
 }
 
-func (n *node) read(timeout uint64) (*RequestState, error) {
-	if !n.initialized() {
+func (n *node) read(ctx context.Context,
+	timeout uint64) (rs *RequestState, err error) {
+	defer n.requestSubmitted(PendingReadIndex, &err)
+	if n.removed() {
+		return nil, ErrReplicaRemoved
+	}
+	if !n.ready() {
 		return nil, ErrShardNotReady
 	}
-	if n.isWitness() {
+	if n.isWitness() || n.isStandby() {
 		return nil, ErrInvalidOperation
 	}
-	rs, err := n.pendingReadIndexes.read(timeout)
+	rs, err = n.pendingReadIndexes.read(ctx, timeout)
 	if err == nil {
 		rs.node = n
 	}
 	return rs, err
 }
 
-func (n *node) requestLeaderTransfer(replicaID uint64) error {
+func (n *node) requestLeaderTransfer(replicaID uint64,
+	opt LeaderTransferOption) error {
 	if !n.initialized() {
 		return ErrShardNotReady
 	}
 	if n.isWitness() {
 		return ErrInvalidOperation
 	}
+	if err := n.checkLeaderTransferTarget(replicaID, opt); err != nil {
+		return err
+	}
 	return n.pendingLeaderTransfer.request(replicaID)
 }
 
+// checkLeaderTransferTarget checks whether the specified replica can become
+// the leader based on the local knowledge of the shard. whether the target
+// has caught up with the leader can only be checked on the leader.
+func (n *node) checkLeaderTransferTarget(target uint64,
+	opt LeaderTransferOption) error {
+	if target == pb.NoNode {
+		return ErrInvalidTarget
+	}
+	m := n.sm.GetMembership()
+	if _, ok := m.Witnesses[target]; ok {
+		return ErrTargetIsWitness
+	}
+	if _, ok := m.NonVotings[target]; ok {
+		return ErrTargetIsNonVoting
+	}
+	if _, ok := m.Addresses[target]; !ok {
+		return ErrTargetNotMember
+	}
+	if opt.NoCatchupWait {
+		n.raftMu.Lock()
+		caughtUp, ok := n.p.LeaderTransferTargetCaughtUp(target)
+		n.raftMu.Unlock()
+		if ok && !caughtUp {
+			return ErrTargetLagging
+		}
+	}
+	return nil
+}
+
 func (n *node) requestSnapshot(opt SnapshotOption,
-	timeout uint64) (*RequestState, error) {
-	if !n.initialized() {
+	timeout uint64) (rs *RequestState, err error) {
+	defer n.requestSubmitted(PendingSnapshot, &err)
+	if !n.ready() {
 		return nil, ErrShardNotReady
 	}
-	if n.isWitness() {
+	if n.isWitness() || n.isStandby() {
 		return nil, ErrInvalidOperation
 	}
 	st := rsm.UserRequested
 	if opt.Exported {
 		plog.Debugf("%s called export snapshot", n.id())
 		st = rsm.Exported
-		exist, err := fileutil.Exist(opt.ExportPath, n.snapshotter.fs)
-		if err != nil {
-			return nil, err
-		}
-		if !exist {
-			return nil, ErrDirNotExist
+		if opt.ExportSink == nil {
+			exist, err := fileutil.Exist(opt.ExportPath, n.snapshotter.fs)
+			if err != nil {
+				return nil, err
+			}
+			if !exist {
+				return nil, ErrDirNotExist
+			}
 		}
 	} else {
 		if len(opt.ExportPath) > 0 {
@@ -506,11 +857,22 @@ func (n *node) requestSnapshot(opt SnapshotOption,
 			opt.ExportPath = ""
 		}
 	}
+	leaderTerm := uint64(0)
+	if opt.LeaderOnly {
+		leaderID, term, ok := n.getLeaderID()
+		if !ok || leaderID != n.replicaID {
+			return nil, n.notLeaderError()
+		}
+		leaderTerm = term
+	}
 	return n.pendingSnapshot.request(st,
 		opt.ExportPath,
+		opt.ExportSink,
 		opt.OverrideCompactionOverhead,
 		opt.CompactionOverhead,
 		opt.CompactionIndex,
+		leaderTerm,
+		opt.Prioritized,
 		timeout)
 }
 
@@ -526,35 +888,146 @@ func (n *node) queryRaftLog(firstIndex uint64,
 }
 
 func (n *node) reportIgnoredSnapshotRequest(key uint64) {
-	n.pendingSnapshot.apply(key, true, false, 0)
+	n.pendingSnapshot.apply(key, true, false, SnapshotResult{})
 }
 
 func (n *node) requestConfigChange(cct pb.ConfigChangeType,
 	replicaID uint64, target string, orderID uint64,
 	timeout uint64) (*RequestState, error) {
-	if !n.initialized() {
+	cc := pb.ConfigChange{
+		Type:           cct,
+		ReplicaID:      replicaID,
+		ConfigChangeId: orderID,
+		Address:        target,
+	}
+	return n.proposeConfigChange(cc, timeout)
+}
+
+func (n *node) proposeConfigChange(cc pb.ConfigChange,
+	timeout uint64) (rs *RequestState, err error) {
+	defer n.requestSubmitted(PendingConfigChange, &err)
+	if !n.ready() {
 		return nil, ErrShardNotReady
 	}
 	if n.isWitness() {
 		return nil, ErrInvalidOperation
 	}
-	if cct != pb.RemoveNode && !n.validateTarget(target) {
+	if cc.Type != pb.RemoveNode && !n.validateTarget(cc.Address) {
 		return nil, ErrInvalidAddress
 	}
+	if rsm.ExceedsMembershipLimits(n.sm.GetMembership(), cc) {
+		return nil, ErrMembershipTooLarge
+	}
+	return n.pendingConfigChange.request(cc, timeout)
+}
+
+func (n *node) requestReconfigure(members map[uint64]string,
+	orderID uint64, timeout uint64) (*RequestState, error) {
+	return n.requestJoint(members, orderID, timeout, false)
+}
+
+// requestJoint requests the regular nodes to be replaced by the specified
+// members using the joint consensus approach. The request is completed once
+// the joint config is entered when enterOnly is set, or once the joint config
+// is left otherwise.
+func (n *node) requestJoint(members map[uint64]string,
+	orderID uint64, timeout uint64, enterOnly bool) (rs *RequestState, err error) {
+	defer n.requestSubmitted(PendingConfigChange, &err)
+	if !n.ready() {
+		return nil, ErrShardNotReady
+	}
+	if n.isWitness() {
+		return nil, ErrInvalidOperation
+	}
+	if len(members) == 0 {
+		return nil, ErrInvalidOperation
+	}
+	for _, target := range members {
+		if !n.validateTarget(target) {
+			return nil, ErrInvalidAddress
+		}
+	}
 	cc := pb.ConfigChange{
-		Type:           cct,
-		ReplicaID:      replicaID,
+		Type:           pb.EnterJoint,
 		ConfigChangeId: orderID,
-		Address:        target,
+		Members:        members,
+	}
+	if rsm.ExceedsMembershipLimits(n.sm.GetMembership(), cc) {
+		return nil, ErrMembershipTooLarge
+	}
+	if enterOnly {
+		return n.pendingConfigChange.requestEnterJoint(cc, timeout)
 	}
 	return n.pendingConfigChange.request(cc, timeout)
 }
 
+// requestReplace requests the regular node oldID to be replaced by the new
+// node newID using the joint consensus approach.
+func (n *node) requestReplace(oldID uint64, newID uint64, target string,
+	orderID uint64, timeout uint64) (*RequestState, error) {
+	if oldID == newID {
+		return nil, ErrInvalidOperation
+	}
+	m := n.sm.GetMembership()
+	if _, ok := m.Addresses[oldID]; !ok {
+		return nil, ErrInvalidOperation
+	}
+	if _, ok := m.Addresses[newID]; ok {
+		return nil, ErrInvalidOperation
+	}
+	members := make(map[uint64]string, len(m.Addresses))
+	for nid, addr := range m.Addresses {
+		if nid != oldID {
+			members[nid] = addr
+		}
+	}
+	members[newID] = target
+	// the new node is usually started after the request is completed, the
+	// request can't wait for the LeaveJoint entry that might require the new
+	// node to be committed
+	return n.requestJoint(members, orderID, timeout, true)
+}
+
+// requestReplaceWitness requests the witness oldID to be replaced by the new
+// witness newID in a single config change.
+func (n *node) requestReplaceWitness(oldID uint64, newID uint64, target string,
+	orderID uint64, timeout uint64) (*RequestState, error) {
+	if oldID == newID {
+		return nil, ErrInvalidOperation
+	}
+	m := n.sm.GetMembership()
+	if _, ok := m.Witnesses[oldID]; !ok {
+		return nil, ErrInvalidOperation
+	}
+	if _, ok := m.Witnesses[newID]; ok {
+		return nil, ErrInvalidOperation
+	}
+	cc := pb.ConfigChange{
+		Type:           pb.ReplaceWitness,
+		ReplicaID:      newID,
+		ReplacedID:     oldID,
+		ConfigChangeId: orderID,
+		Address:        target,
+	}
+	return n.proposeConfigChange(cc, timeout)
+}
+
 func (n *node) requestDeleteNodeWithOrderID(replicaID uint64,
 	order uint64, timeout uint64) (*RequestState, error) {
 	return n.requestConfigChange(pb.RemoveNode, replicaID, "", order, timeout)
 }
 
+func (n *node) requestForceDeleteNodeWithOrderID(replicaID uint64,
+	order uint64, timeout uint64) (*RequestState, error) {
+	cc := pb.ConfigChange{
+		Type:           pb.RemoveNode,
+		ReplicaID:      replicaID,
+		ConfigChangeId: order,
+		Force:          true,
+	}
+	return n.proposeConfigChange(cc, timeout)
+}
+
 func (n *node) requestAddNodeWithOrderID(replicaID uint64,
 	target string, order uint64, timeout uint64) (*RequestState, error) {
 	return n.requestConfigChange(pb.AddNode, replicaID, target, order, timeout)
@@ -565,11 +1038,98 @@ func (n *node) requestAddNonVotingWithOrderID(replicaID uint64,
 	return n.requestConfigChange(pb.AddNonVoting, replicaID, target, order, timeout)
 }
 
+func (n *node) requestAddWithOption(cct pb.ConfigChangeType,
+	replicaID uint64, target string, order uint64,
+	allowReuse bool, timeout uint64) (*RequestState, error) {
+	cc := pb.ConfigChange{
+		Type:           cct,
+		ReplicaID:      replicaID,
+		ConfigChangeId: order,
+		Address:        target,
+		AllowReuse:     allowReuse,
+	}
+	return n.proposeConfigChange(cc, timeout)
+}
+
+func (n *node) requestAddStagedWithOrderID(replicaID uint64,
+	target string, order uint64, timeout uint64) (*RequestState, error) {
+	cc := pb.ConfigChange{
+		Type:           pb.AddNonVoting,
+		ReplicaID:      replicaID,
+		ConfigChangeId: order,
+		Address:        target,
+		Staged:         true,
+	}
+	return n.proposeConfigChange(cc, timeout)
+}
+
 func (n *node) requestAddWitnessWithOrderID(replicaID uint64,
 	target string, order uint64, timeout uint64) (*RequestState, error) {
 	return n.requestConfigChange(pb.AddWitness, replicaID, target, order, timeout)
 }
 
+func (n *node) requestUpdateAddressWithOrderID(replicaID uint64,
+	target string, order uint64, timeout uint64) (*RequestState, error) {
+	return n.requestConfigChange(pb.UpdateAddress,
+		replicaID, target, order, timeout)
+}
+
+func (n *node) requestPromoteWitnessWithOrderID(replicaID uint64,
+	order uint64, timeout uint64) (*RequestState, error) {
+	target, ok := n.sm.GetMembership().Witnesses[replicaID]
+	if !ok {
+		return nil, ErrInvalidOperation
+	}
+	return n.requestConfigChange(pb.PromoteWitness,
+		replicaID, target, order, timeout)
+}
+
+func (n *node) getNonVotingProgress() (map[uint64]NonVotingProgress, bool) {
+	n.raftMu.Lock()
+	progress := n.p.GetNonVotingProgress()
+	n.raftMu.Unlock()
+	if progress == nil {
+		return nil, false
+	}
+	result := make(map[uint64]NonVotingProgress, len(progress))
+	for replicaID, p := range progress {
+		result[replicaID] = NonVotingProgress{Match: p.Match, Lag: p.Lag}
+	}
+	return result, true
+}
+
+func (n *node) getElectionStats() ElectionStats {
+	n.raftMu.Lock()
+	defer n.raftMu.Unlock()
+	return n.p.GetElectionStats()
+}
+
+func (n *node) getLocalLag() uint64 {
+	n.raftMu.Lock()
+	committed := n.p.GetCommitted()
+	n.raftMu.Unlock()
+	if applied := n.sm.GetLastApplied(); committed > applied {
+		return committed - applied
+	}
+	return 0
+}
+
+// getInMemLogRetention returns the size of log entries kept in memory grouped
+// by the reason they are retained.
+func (n *node) getInMemLogRetention() InMemLogRetention {
+	n.raftMu.Lock()
+	defer n.raftMu.Unlock()
+	return n.p.GetInMemLogRetention()
+}
+
+// getLogIndexes returns the last index and the committed index of the local
+// raft log.
+func (n *node) getLogIndexes() (uint64, uint64) {
+	n.raftMu.Lock()
+	defer n.raftMu.Unlock()
+	return n.p.GetLastIndex(), n.p.GetCommitted()
+}
+
 func (n *node) getLeaderID() (uint64, uint64, bool) {
 	lv := n.leaderInfo.Load()
 	if lv == nil {
@@ -639,6 +1199,10 @@ func (n *node) pushStreamSnapshotRequest(shardID uint64, replicaID uint64) {
 }
 
 func (n *node) pushTakeSnapshotRequest(req rsm.SSRequest) {
+	if n.isStandby() {
+		// the placeholder state machine of the standby has nothing to save
+		return
+	}
 	n.pushTask(rsm.Task{
 		Save:      true,
 		SSRequest: req,
@@ -665,6 +1229,23 @@ func (n *node) pushSnapshot(ss pb.Snapshot, applied uint64) {
 
 func (n *node) replayLog(shardID uint64, replicaID uint64) (bool, error) {
 	plog.Infof("%s replaying raft logs", n.id())
+	bi, err := n.logdb.GetBootstrapInfo(shardID, replicaID)
+	if err != nil && !errors.Is(err, raftio.ErrNoBootstrapInfo) {
+		return false, errors.Wrapf(err, "%s failed to get bootstrap info", n.id())
+	}
+	if bi.Promoted {
+		return true, n.resetPromotedWitness(shardID, replicaID)
+	}
+	n.witnessIndex = bi.WitnessIndex
+	if bi.UnsafeRecoveries > 0 {
+		n.unsafeRecovery = UnsafeRecoveryDump{
+			Count: bi.UnsafeRecoveries,
+			Index: bi.UnsafeRecoveryIndex,
+			Time:  bi.UnsafeRecoveryTime,
+		}
+		plog.Warningf("%s membership was unsafely recovered at index %d",
+			n.id(), bi.UnsafeRecoveryIndex)
+	}
 	ss, err := n.snapshotter.GetSnapshotFromLogDB()
 	if err != nil && !n.snapshotter.IsNoSnapshotError(err) {
 		return false, errors.Wrapf(err, "%s failed to get latest snapshot", n.id())
@@ -673,6 +1254,11 @@ func (n *node) replayLog(shardID uint64, replicaID uint64) (bool, error) {
 		if err = n.logReader.ApplySnapshot(ss); err != nil {
 			return false, errors.Wrapf(err, "%s failed to apply snapshot", n.id())
 		}
+		if n.config.LazyReplay {
+			// committed entries are pushed before the state machine is recovered
+			// from the snapshot
+			n.pushedIndex = ss.Index
+		}
 	}
 	rs, err := n.logdb.ReadRaftState(shardID, replicaID, ss.Index)
 	if errors.Is(err, raftio.ErrNoSavedLog) {
@@ -683,6 +1269,8 @@ func (n *node) replayLog(shardID uint64, replicaID uint64) (bool, error) {
 	}
 	hasRaftState := !pb.IsEmptyState(rs.State)
 	if hasRaftState {
+		n.replayedIndex = rs.State.Commit
+		atomic.StoreUint64(&n.committedIndex, rs.State.Commit)
 		plog.Infof("%s logdb first entry %d size %d commit %d term %d",
 			n.id(), rs.FirstIndex, rs.EntryCount, rs.State.Commit, rs.State.Term)
 		n.logReader.SetState(rs.State)
@@ -691,6 +1279,50 @@ func (n *node) replayLog(shardID uint64, replicaID uint64) (bool, error) {
 	return !(ss.Index > 0 || rs.EntryCount > 0 || hasRaftState), nil
 }
 
+// resetPromotedWitness removes the local data of the promoted witness as its
+// raft log only contains metadata entries. The term and vote are kept, the node
+// then joins the shard as a new node to get the snapshot from the leader. Log
+// entries acknowledged by the witness might have been committed with its help,
+// the last index of the witness log is thus recorded in the bootstrap info and
+// the node doesn't vote or campaign before its log catches up, see startRaft.
+func (n *node) resetPromotedWitness(shardID uint64, replicaID uint64) error {
+	plog.Infof("%s is a promoted witness, removing its witness data", n.id())
+	ss, err := n.snapshotter.GetSnapshotFromLogDB()
+	if err != nil && !n.snapshotter.IsNoSnapshotError(err) {
+		return errors.Wrapf(err, "%s failed to get latest snapshot", n.id())
+	}
+	rs, err := n.logdb.ReadRaftState(shardID, replicaID, ss.Index)
+	if err != nil && !errors.Is(err, raftio.ErrNoSavedLog) {
+		return errors.Wrapf(err, "%s ReadRaftState failed", n.id())
+	}
+	index, term := ss.Index, ss.Term
+	if rs.EntryCount > 0 {
+		index = rs.FirstIndex + rs.EntryCount - 1
+		ents, _, err := n.logdb.IterateEntries(nil, 0,
+			shardID, replicaID, index, index+1, math.MaxUint64)
+		if err != nil {
+			return errors.Wrapf(err, "%s failed to get last entry", n.id())
+		}
+		if len(ents) != 1 {
+			return errors.Errorf("%s failed to get last entry %d", n.id(), index)
+		}
+		term = ents[0].Term
+	}
+	if err := n.logdb.RemoveNodeData(shardID, replicaID); err != nil {
+		return err
+	}
+	bi := pb.NewBootstrapInfo(true, n.sm.Type(), nil)
+	bi.WitnessIndex, bi.WitnessTerm = index, term
+	if err := n.logdb.SaveBootstrapInfo(shardID, replicaID, bi); err != nil {
+		return err
+	}
+	n.witnessIndex = index
+	if !pb.IsEmptyState(rs.State) {
+		n.logReader.SetState(pb.State{Term: rs.State.Term, Vote: rs.State.Vote})
+	}
+	return nil
+}
+
 func (n *node) saveSnapshotRequired(applied uint64) bool {
 	if n.config.SnapshotEntries == 0 {
 		return false
@@ -709,6 +1341,37 @@ func (n *node) saveSnapshotRequired(applied uint64) bool {
 	return true
 }
 
+// snapshotIntervalReached returns a boolean value indicating whether a
+// snapshot should be requested as SnapshotIntervalSeconds has elapsed since
+// the last snapshot. It is invoked on each tick.
+func (n *node) snapshotIntervalReached() bool {
+	if n.config.SnapshotIntervalSeconds == 0 || !n.initialized() {
+		return false
+	}
+	now := n.clock().UnixNano()
+	last := n.ss.getTime()
+	if last == 0 {
+		// time of the last snapshot is unknown, the interval starts now
+		n.ss.setTime(now)
+		return false
+	}
+	interval := time.Duration(n.config.SnapshotIntervalSeconds) * time.Second
+	if time.Duration(now-last) < interval {
+		return false
+	}
+	applied := n.sm.GetLastApplied()
+	if applied <= n.ss.getIndex() || applied <= n.ss.getReqIndex() {
+		return false
+	}
+	if n.isBusySnapshotting() {
+		return false
+	}
+	plog.Debugf("%s snapshot interval reached, requested to create %s",
+		n.id(), n.ssid(applied))
+	n.ss.setReqIndex(applied)
+	return true
+}
+
 func isSoftSnapshotError(err error) bool {
 	return errors.Is(err, raft.ErrCompacted) ||
 		errors.Is(err, raft.ErrSnapshotOutOfDate)
@@ -737,11 +1400,12 @@ func recoverAborted(err error) bool {
 }
 
 func (n *node) save(rec rsm.Task) error {
-	index, err := n.doSave(rec.SSRequest)
+	result, err := n.doSave(rec.SSRequest)
 	if err != nil {
 		return err
 	}
-	n.pendingSnapshot.apply(rec.SSRequest.Key, index == 0, false, index)
+	n.pendingSnapshot.apply(rec.SSRequest.Key,
+		result.Index == 0, false, result)
 	n.sysEvents.Publish(server.SystemEvent{
 		Type:      server.SnapshotCreated,
 		ShardID:   n.shardID,
@@ -750,58 +1414,98 @@ func (n *node) save(rec rsm.Task) error {
 	return nil
 }
 
-func (n *node) doSave(req rsm.SSRequest) (uint64, error) {
+func (n *node) doSave(req rsm.SSRequest) (SnapshotResult, error) {
 	n.snapshotLock.Lock()
 	defer n.snapshotLock.Unlock()
 	if !req.Exported() && n.sm.GetLastApplied() <= n.ss.getIndex() {
 		// a snapshot has been pushed to the sm but not applied yet
 		// or the snapshot has been applied and there is no further progress
-		return 0, nil
+		return SnapshotResult{}, nil
+	}
+	if req.Sink == nil && !n.waitForStagingSpace() {
+		n.pendingSnapshot.apply(req.Key, false, true, SnapshotResult{})
+		return SnapshotResult{}, nil
 	}
+	start := n.shardMetrics.now()
+	slowStart := n.slowOps.smStarted()
 	ss, ssenv, err := n.sm.Save(req)
+	n.slowOps.smDone(slowSaveSnapshot, slowStart, ss.Index)
+	defer n.snapshotter.staging.Release(ssenv.GetTempDir())
 	if err != nil {
-		if saveAborted(err) {
+		if req.Sink != nil {
+			n.abortExport(req, err)
+			return SnapshotResult{}, nil
+		} else if server.IsNoSpace(err) {
+			n.abortNoSpace(req, ssenv, err)
+			return SnapshotResult{}, nil
+		} else if saveAborted(err) {
 			plog.Warningf("%s save snapshot aborted, %v", n.id(), err)
 			ssenv.MustRemoveTempDir()
-			n.pendingSnapshot.apply(req.Key, false, true, 0)
-			return 0, nil
+			n.pendingSnapshot.apply(req.Key, false, true, SnapshotResult{})
+			return SnapshotResult{}, nil
 		} else if isSoftSnapshotError(err) {
 			// e.g. trying to save a snapshot at the same index twice
-			return 0, nil
+			return SnapshotResult{}, nil
 		}
-		return 0, errors.Wrapf(err, "%s save snapshot failed", n.id())
+		return SnapshotResult{}, errors.Wrapf(err, "%s save snapshot failed", n.id())
 	}
-	plog.Infof("%s saved %s, term %d, file count %d",
-		n.id(), n.ssid(ss.Index), ss.Term, len(ss.Files))
+	plog.Infow("saved snapshot", append(n.logFields(),
+		logger.Uint64("index", ss.Index), logger.Term(ss.Term),
+		logger.Any("files", len(ss.Files)))...)
+	n.shardMetrics.snapshotSaved(start, ss.FileSize)
+	if req.LeaderTerm > 0 && !n.isLeaderInTerm(req.LeaderTerm) {
+		n.abortLeaderExport(req, ssenv)
+		return SnapshotResult{}, nil
+	}
+	ss.CreatedAt = n.clock().UnixNano()
 	if err := n.snapshotter.Commit(ss, req); err != nil {
-		if snapshotCommitAborted(err) || saveAborted(err) {
+		if req.Sink != nil {
+			n.abortExport(req, err)
+			return SnapshotResult{}, nil
+		} else if snapshotCommitAborted(err) || saveAborted(err) {
 			// saveAborted() will only be true in monkey test
 			// commit abort happens when the final dir already exists, probably due to
 			// incoming snapshot
 			ssenv.MustRemoveTempDir()
-			return 0, nil
+			return SnapshotResult{}, nil
+		} else if server.IsNoSpace(err) {
+			n.abortNoSpace(req, ssenv, err)
+			return SnapshotResult{}, nil
 		}
-		return 0, errors.Wrapf(err, "%s commit snapshot failed", n.id())
+		return SnapshotResult{}, errors.Wrapf(err, "%s commit snapshot failed", n.id())
 	}
+	n.recordFingerprint(ss)
 	if req.Exported() {
-		return ss.Index, nil
+		n.recordExport(ss)
+		return n.getSnapshotResult(ss, req), nil
 	}
 	if !ss.Validate(n.snapshotter.fs) {
 		plog.Panicf("%s generated invalid snapshot %v", n.id(), ss)
 	}
 	if err = n.logReader.CreateSnapshot(ss); err != nil {
 		if isSoftSnapshotError(err) {
-			return 0, nil
+			return SnapshotResult{}, nil
 		}
-		return 0, errors.Wrapf(err, "%s create snapshot failed", n.id())
+		return SnapshotResult{}, errors.Wrapf(err, "%s create snapshot failed", n.id())
 	}
 	n.compactLog(req, ss.Index)
 	n.ss.setIndex(ss.Index)
-	return ss.Index, nil
+	n.ss.setTime(ss.CreatedAt)
+	return n.getSnapshotResult(ss, req), nil
+}
+
+// abortExport aborts the export of a snapshot to the ExportSink specified in
+// the request. Failures of the sink, e.g. network errors, are not fatal, the
+// snapshot request is completed as aborted.
+func (n *node) abortExport(req rsm.SSRequest, err error) {
+	plog.Warningf("%s failed to export snapshot, %v", n.id(), err)
+	req.Sink.Abort()
+	n.pendingSnapshot.apply(req.Key, false, true, SnapshotResult{})
 }
 
 func (n *node) compactLog(req rsm.SSRequest, index uint64) {
 	if compactionIndex, ok := n.getCompactionIndex(req, index); ok {
+		atomic.StoreUint64(&n.compactTo, compactionIndex)
 		n.ss.setCompactLogTo(compactionIndex)
 	}
 }
@@ -828,12 +1532,16 @@ func (n *node) getCompactionIndex(req rsm.SSRequest, index uint64) (uint64, bool
 
 func (n *node) stream(sink pb.IChunkSink) error {
 	if sink != nil {
-		plog.Infof("%s requested to stream to %d", n.id(), sink.ToReplicaID())
+		plog.Infow("requested to stream snapshot", append(n.logFields(),
+			logger.Uint64("target", sink.ToReplicaID()))...)
+		start := n.shardMetrics.now()
 		if err := n.sm.Stream(sink); err != nil {
 			if !streamAborted(err) {
 				return errors.Wrapf(err, "%s stream failed", n.id())
 			}
+			return nil
 		}
+		n.shardMetrics.snapshotStreamed(start)
 	}
 	return nil
 }
@@ -855,6 +1563,7 @@ func (n *node) recover(rec rsm.Task) (_ uint64, err error) {
 			plog.Panicf("%s new node at non-zero index %d", n.id(), idx)
 		}
 	}
+	start := n.shardMetrics.now()
 	ss, err := n.sm.Recover(rec)
 	if err != nil {
 		if recoverAborted(err) {
@@ -867,7 +1576,18 @@ func (n *node) recover(rec rsm.Task) (_ uint64, err error) {
 		defer func() {
 			err = firstError(err, ss.Unref())
 		}()
-		plog.Infof("%s recovered from %s", n.id(), n.ssid(ss.Index))
+		plog.Infow("recovered from snapshot", append(n.logFields(),
+			logger.Uint64("index", ss.Index), logger.Term(ss.Term))...)
+		n.shardMetrics.snapshotRecovered(start, ss.FileSize)
+		atomic.StoreUint64(&n.recoveredIndex, ss.Index)
+		if ss.CreatedAt > 0 {
+			n.ss.setTime(ss.CreatedAt)
+		}
+		if !rec.Initial {
+			if err := n.verifyFingerprint(ss); err != nil {
+				return 0, err
+			}
+		}
 		if n.OnDiskStateMachine() {
 			if err := n.sm.Sync(); err != nil {
 				return 0, errors.Wrapf(err, "%s sync failed", n.id())
@@ -915,12 +1635,37 @@ func (n *node) recoverFromSnapshotDone() {
 	n.applyReady()
 }
 
-func (n *node) handleTask(ts []rsm.Task, es []sm.Entry) (rsm.Task, error) {
-	return n.sm.Handle(ts, es)
+func (n *node) handleTask(ts []rsm.Task) (rsm.Task, error) {
+	start := n.shardMetrics.now()
+	defer n.shardMetrics.applied(start)
+	slowStart := n.slowOps.smStarted()
+	degradedStart := n.degraded.updateStarted()
+	task, err := n.sm.Handle(ts)
+	n.degraded.updateDone(degradedStart)
+	n.slowOps.updateDone(slowStart, n.sm.GetLastApplied(), ts)
+	return task, err
+}
+
+func (n *node) lookup(query interface{}) (interface{}, error) {
+	start := n.slowOps.smStarted()
+	data, err := n.sm.Lookup(query)
+	n.slowOps.smDone(slowLookup, start, n.sm.GetLastApplied())
+	return data, err
 }
 
-func (n *node) removeSnapshotFlagFile(index uint64) error {
-	return n.snapshotter.removeFlagFile(index)
+func (n *node) naLookup(query []byte) ([]byte, error) {
+	start := n.slowOps.smStarted()
+	data, err := n.sm.NALookup(query)
+	n.slowOps.smDone(slowLookup, start, n.sm.GetLastApplied())
+	return data, err
+}
+
+func (n *node) removeSnapshotFlagFile(ss pb.Snapshot) error {
+	// witness snapshots sent as regular messages have no snapshot directory
+	if ss.Witness && ss.Filepath == "" {
+		return nil
+	}
+	return n.snapshotter.removeFlagFile(ss.Index)
 }
 
 func (n *node) runSyncTask() {
@@ -941,28 +1686,43 @@ func (n *node) removeLog() error {
 		if compactTo == 0 {
 			panic("racy compact log to value?")
 		}
+		if compactTo = n.holdCompaction(compactTo); compactTo == 0 {
+			return nil
+		}
 		if err := n.logReader.Compact(compactTo); err != nil {
 			if err != raft.ErrCompacted {
 				return err
 			}
 		}
-		if err := n.logdb.RemoveEntriesTo(n.shardID,
-			n.replicaID, compactTo); err != nil {
-			return err
+		if n.config.CompactedEntriesRetentionTicks > 0 {
+			n.retainCompactedLog(compactTo)
+			return nil
 		}
-		plog.Infof("%s compacted log up to index %d", n.id(), compactTo)
-		n.ss.setCompactedTo(compactTo)
-		n.sysEvents.Publish(server.SystemEvent{
-			Type:      server.LogCompacted,
-			ShardID:   n.shardID,
-			ReplicaID: n.replicaID,
-			Index:     compactTo,
-		})
-		if !n.config.DisableAutoCompactions {
-			if _, err := n.requestCompaction(); err != nil {
-				if err != ErrRejected {
-					return errors.Wrapf(err, "%s failed to request compaction", n.id())
-				}
+		return n.removeCompactedLog(compactTo)
+	}
+	return nil
+}
+
+// removeCompactedLog removes entries up to compactTo, which have already been
+// compacted from the log, from the LogDB.
+func (n *node) removeCompactedLog(compactTo uint64) error {
+	n.logReader.SetRemovedTo(compactTo)
+	if err := n.logdb.RemoveEntriesTo(n.shardID,
+		n.replicaID, compactTo); err != nil {
+		return err
+	}
+	plog.Infof("%s compacted log up to index %d", n.id(), compactTo)
+	n.ss.setCompactedTo(compactTo)
+	n.sysEvents.Publish(server.SystemEvent{
+		Type:      server.LogCompacted,
+		ShardID:   n.shardID,
+		ReplicaID: n.replicaID,
+		Index:     compactTo,
+	})
+	if !n.config.DisableAutoCompactions {
+		if _, err := n.requestCompaction(); err != nil {
+			if err != ErrRejected {
+				return errors.Wrapf(err, "%s failed to request compaction", n.id())
 			}
 		}
 	}
@@ -971,19 +1731,150 @@ func (n *node) removeLog() error {
 
 func (n *node) requestCompaction() (*SysOpState, error) {
 	if compactTo := n.ss.getCompactedTo(); compactTo > 0 {
-		done, err := n.logdb.CompactEntriesTo(n.shardID, n.replicaID, compactTo)
-		if err != nil {
-			return nil, err
-		}
+		return n.compactLogDB(compactTo)
+	}
+	return nil, ErrRejected
+}
+
+// compactLogDB requests the LogDB to reclaim the storage space used by entries
+// up to compactTo which have already been removed from the LogDB.
+func (n *node) compactLogDB(compactTo uint64) (*SysOpState, error) {
+	done, err := n.logdb.CompactEntriesTo(n.shardID, n.replicaID, compactTo)
+	if err != nil {
+		return nil, err
+	}
+	n.sysEvents.Publish(server.SystemEvent{
+		Type:      server.LogDBCompacted,
+		ShardID:   n.shardID,
+		ReplicaID: n.replicaID,
+		Index:     compactTo,
+	})
+	return &SysOpState{completedC: done}, nil
+}
+
+func getBootstrapHash(peers map[uint64]string,
+	initialMember bool, mode config.WriteFsyncMode) uint64 {
+	if !initialMember {
+		return 0
+	}
+	bi := pb.Bootstrap{Addresses: peers, WriteFsyncMode: uint32(mode)}
+	return bi.MembersHash()
+}
+
+// checkBootstrapHash returns a boolean value indicating whether the received
+// message is from a replica bootstrapped with the same initial members and
+// write fsync mode. such check is skipped when either replica joined the
+// shard. the first mismatched message from each remote replica is reported as
+// a system event.
+func (n *node) checkBootstrapHash(m pb.Message) bool {
+	if m.BootstrapHash == 0 ||
+		n.bootstrapHash == 0 || m.BootstrapHash == n.bootstrapHash {
+		return true
+	}
+	if _, reported := n.bootstrapMismatches.LoadOrStore(m.From, m.BootstrapHash); !reported {
+		plog.Errorf("%s dropping messages from %s, bootstrap mismatch, %d vs %d",
+			n.id(), dn(n.shardID, m.From), n.bootstrapHash, m.BootstrapHash)
+		n.sysEvents.Publish(server.SystemEvent{
+			Type:       server.BootstrapMismatch,
+			ShardID:    n.shardID,
+			ReplicaID:  n.replicaID,
+			From:       m.From,
+			LocalHash:  n.bootstrapHash,
+			RemoteHash: m.BootstrapHash,
+		})
+	}
+	return false
+}
+
+// getTimings returns the election timeout and heartbeat interval in
+// milliseconds exchanged with remote replicas. They are only exchanged when
+// the timings are configured as absolute durations.
+func getTimings(cfg config.Config, rttMillisecond uint64) (uint64, uint64) {
+	if cfg.ElectionTimeout == 0 {
+		return 0, 0
+	}
+	return cfg.ElectionRTT * rttMillisecond, cfg.HeartbeatRTT * rttMillisecond
+}
+
+// checkTimings returns a boolean value indicating whether the received message
+// is from a replica with timings compatible with the local replica, i.e. the
+// remote heartbeat interval is short enough for the local replica to not
+// start elections when the remote replica is the leader. such check is skipped
+// when either replica has its timings configured in terms of RTTMillisecond.
+// the first incompatible message from each remote replica is reported as a
+// system event.
+func (n *node) checkTimings(m pb.Message) bool {
+	if m.HeartbeatInterval == 0 || n.electionTimeout == 0 ||
+		n.electionTimeout > 2*m.HeartbeatInterval {
+		return true
+	}
+	if _, reported := n.bootstrapMismatches.LoadOrStore(m.From, m.HeartbeatInterval); !reported {
+		plog.Errorf("%s dropping messages from %s, election timeout %dms, "+
+			"remote heartbeat interval %dms", n.id(), dn(n.shardID, m.From),
+			n.electionTimeout, m.HeartbeatInterval)
 		n.sysEvents.Publish(server.SystemEvent{
-			Type:      server.LogDBCompacted,
+			Type:      server.BootstrapMismatch,
 			ShardID:   n.shardID,
 			ReplicaID: n.replicaID,
-			Index:     compactTo,
+			From:      m.From,
+			Duration:  time.Duration(n.electionTimeout) * time.Millisecond,
+			Interval:  time.Duration(m.HeartbeatInterval) * time.Millisecond,
 		})
-		return &SysOpState{completedC: done}, nil
 	}
-	return nil, ErrRejected
+	return false
+}
+
+// recordPeerVersion records the protocol version advertised by the sender of
+// the received message. only Raft messages sent on behalf of the remote Raft
+// instance are guaranteed to carry its protocol version.
+func (n *node) recordPeerVersion(m pb.Message) {
+	switch m.Type {
+	case pb.Replicate, pb.ReplicateResp, pb.Heartbeat, pb.HeartbeatResp:
+		n.peerVersions.Store(m.From, m.ProtocolVersion)
+	}
+}
+
+// peerSupports returns a boolean value indicating whether the specified remote
+// replica has advertised support of the specified protocol version. replicas
+// that haven't been heard from are not considered as supporting any version.
+func (n *node) peerSupports(replicaID uint64, version uint32) bool {
+	v, ok := n.peerVersions.Load(replicaID)
+	return ok && v.(uint32) >= version
+}
+
+// membersSupport returns a boolean value indicating whether all other members
+// of the shard that apply entries, i.e. witnesses are excluded, have advertised
+// support of the specified protocol version.
+func (n *node) membersSupport(version uint32) bool {
+	m := n.sm.GetMembership()
+	for _, members := range []map[uint64]string{m.Addresses, m.NonVotings} {
+		for replicaID := range members {
+			if replicaID != n.replicaID && !n.peerSupports(replicaID, version) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (n *node) setRetired(retired map[string]uint64) {
+	n.retired.Store(retired)
+}
+
+// checkSource returns a boolean value indicating whether the message is
+// accepted from the specified source address. Messages sent by a replica from
+// an address it has moved away from are dropped so a stale instance left
+// running on the old address can't be mistaken for the replica.
+func (n *node) checkSource(m pb.Message, source string) bool {
+	retired, _ := n.retired.Load().(map[string]uint64)
+	if nid, ok := retired[source]; !ok || nid != m.From {
+		return true
+	}
+	if _, reported := n.retiredSources.LoadOrStore(source, m.From); !reported {
+		plog.Errorf("%s dropping messages from %s, retired address %s",
+			n.id(), dn(n.shardID, m.From), source)
+	}
+	return false
 }
 
 func isFreeOrderMessage(m pb.Message) bool {
@@ -991,14 +1882,23 @@ func isFreeOrderMessage(m pb.Message) bool {
 }
 
 func (n *node) sendEnterQuiesceMessages() {
+	// remote replicas are asked to ignore their recent activities when the
+	// local replica was manually requested to quiesce
+	hint := uint64(0)
+	if n.qs.takeForced() {
+		hint = 1
+	}
 	for replicaID := range n.sm.GetMembership().Addresses {
 		if replicaID != n.replicaID {
 			msg := pb.Message{
-				Type:    pb.Quiesce,
-				From:    n.replicaID,
-				To:      replicaID,
-				ShardID: n.shardID,
+				Type:          pb.Quiesce,
+				Hint:          hint,
+				From:          n.replicaID,
+				To:            replicaID,
+				ShardID:       n.shardID,
+				BootstrapHash: n.bootstrapHash,
 			}
+			n.setSenderInfo(&msg)
 			n.sendRaftMessage(msg)
 		}
 	}
@@ -1007,16 +1907,41 @@ func (n *node) sendEnterQuiesceMessages() {
 func (n *node) sendMessages(msgs []pb.Message) {
 	for _, msg := range msgs {
 		if !isFreeOrderMessage(msg) {
+			n.assertAckPersisted(msg)
 			msg.ShardID = n.shardID
+			msg.BootstrapHash = n.bootstrapHash
+			n.setSenderInfo(&msg)
 			n.sendRaftMessage(msg)
 		}
 	}
 }
 
+// setSenderInfo sets the timings and the protocol version of the local
+// replica to the message.
+func (n *node) setSenderInfo(msg *pb.Message) {
+	msg.ElectionTimeout = n.electionTimeout
+	msg.HeartbeatInterval = n.heartbeatInterval
+	msg.ProtocolVersion = pb.ProtocolVersion
+}
+
+// assertAckPersisted panics in race builds when the message acknowledges
+// entries not yet persisted.
+func (n *node) assertAckPersisted(msg pb.Message) {
+	if !invariants.Race || msg.Type != pb.ReplicateResp || msg.Reject {
+		return
+	}
+	if _, persisted := n.logReader.GetRange(); msg.LogIndex > persisted {
+		plog.Panicf("%s acknowledging entry %d not persisted, persisted %d",
+			n.id(), msg.LogIndex, persisted)
+	}
+}
+
 func (n *node) sendReplicateMessages(ud pb.Update) {
 	for _, msg := range ud.Messages {
 		if isFreeOrderMessage(msg) {
 			msg.ShardID = n.shardID
+			msg.BootstrapHash = n.bootstrapHash
+			n.setSenderInfo(&msg)
 			n.sendRaftMessage(msg)
 		}
 	}
@@ -1035,6 +1960,10 @@ func (n *node) getUpdate() (pb.Update, bool, error) {
 		if err != nil {
 			return pb.Update{}, false, err
 		}
+		// term and vote changes are always synced, otherwise a replica might
+		// vote twice in the same term after losing unsynced writes
+		ud.RelaxedFsync = n.config.WriteFsyncMode == config.RelaxedFsync &&
+			!n.p.IsTermOrVoteChanged(ud)
 		n.confirmedIndex = n.appliedIndex
 		return ud, true, nil
 	}
@@ -1045,6 +1974,7 @@ func (n *node) processDroppedReadIndexes(ud pb.Update) {
 	for _, sysctx := range ud.DroppedReadIndexes {
 		n.pendingReadIndexes.dropped(sysctx)
 	}
+	n.readIndexCompleted()
 }
 
 func (n *node) processDroppedEntries(ud pb.Update) {
@@ -1059,6 +1989,21 @@ func (n *node) processDroppedEntries(ud pb.Update) {
 	}
 }
 
+// processUncommittedEntries fails requests of entries not committed when the
+// leader stepped down, such requests are completed with the timeout result as
+// their entries might still be committed by the new leader.
+func (n *node) processUncommittedEntries(ud pb.Update) {
+	for _, e := range ud.UncommittedEntries {
+		if e.IsProposal() {
+			n.pendingProposals.timedOut(e.ClientID, e.SeriesID, e.Key)
+		} else if e.Type == pb.ConfigChangeEntry {
+			n.pendingConfigChange.timedOut(e.Key)
+		} else {
+			plog.Panicf("unknown entry type %s", e.Type)
+		}
+	}
+}
+
 func (n *node) notifyCommittedEntries() {
 	tasks := n.toCommitQ.GetAll()
 	for _, t := range tasks {
@@ -1082,6 +2027,17 @@ func (n *node) processReadyToRead(ud pb.Update) {
 	if len(ud.ReadyToReads) > 0 {
 		n.pendingReadIndexes.addReady(ud.ReadyToReads)
 		n.pendingReadIndexes.applied(ud.LastApplied)
+		n.readIndexCompleted()
+	}
+}
+
+// readIndexCompleted has the shard stepped again when reads were held back
+// by read batching and the ReadIndex round in flight has completed.
+func (n *node) readIndexCompleted() {
+	if n.pendingReadIndexes.batchDelay > 0 &&
+		n.incomingReadIndexes.pendingSize() > 0 &&
+		!n.pendingReadIndexes.isInflight() {
+		n.pipeline.setStepReady(n.shardID)
 	}
 }
 
@@ -1097,11 +2053,58 @@ func (n *node) processSnapshot(ud pb.Update) error {
 	return nil
 }
 
-func (n *node) applyRaftUpdates(ud pb.Update) {
-	n.pushEntries(pb.EntriesToApply(ud.CommittedEntries, n.pushedIndex, true))
+func (n *node) applyRaftUpdates(ud pb.Update, saved bool) {
+	ents := pb.EntriesToApply(ud.CommittedEntries, n.pushedIndex, true)
+	n.assertPersisted(ents, ud, saved)
+	n.pushEntries(ents)
+}
+
+// applyPersistedEntries pushes committed entries of the update already
+// persisted by earlier updates to the state machine before entries of the
+// update are persisted, they are applied while the update is being saved
+// into the LogDB. Remaining committed entries are pushed by applyRaftUpdates
+// once the update is saved. The number of entries pending to be applied is
+// still bounded as no committed entry is returned by the raft protocol when
+// there are already TaskQueueTargetLength tasks pending to be applied.
+func (n *node) applyPersistedEntries(ud pb.Update) {
+	if !pb.IsEmptySnapshot(ud.Snapshot) || len(ud.EntriesToSave) == 0 {
+		return
+	}
+	first := ud.EntriesToSave[0].Index
+	ents := ud.CommittedEntries
+	count := sort.Search(len(ents), func(i int) bool {
+		return ents[i].Index >= first
+	})
+	ents = pb.EntriesToApply(ents[:count], n.pushedIndex, false)
+	n.assertPersisted(ents, ud, false)
+	n.pushEntries(ents)
+}
+
+// assertPersisted panics in race builds when entries to be applied are not
+// all persisted. The saved parameter indicates whether entries of the update
+// have been saved into the LogDB.
+func (n *node) assertPersisted(ents []pb.Entry, ud pb.Update, saved bool) {
+	if !invariants.Race || len(ents) == 0 {
+		return
+	}
+	_, persisted := n.logReader.GetRange()
+	if saved && len(ud.EntriesToSave) > 0 {
+		if last := ud.EntriesToSave[len(ud.EntriesToSave)-1].Index; last > persisted {
+			persisted = last
+		}
+	}
+	if last := ents[len(ents)-1].Index; last > persisted {
+		plog.Panicf("%s applying entry %d not persisted, persisted %d",
+			n.id(), last, persisted)
+	}
 }
 
 func (n *node) processRaftUpdate(ud pb.Update) error {
+	n.traceRaftUpdate(ud)
+	n.updatePendingStages(ud)
+	if ud.Commit > 0 {
+		atomic.StoreUint64(&n.committedIndex, ud.Commit)
+	}
 	if err := n.logReader.Append(ud.EntriesToSave); err != nil {
 		return err
 	}
@@ -1139,11 +2142,12 @@ func (n *node) updateAppliedIndex() uint64 {
 func (n *node) stepNode() (pb.Update, bool, error) {
 	n.raftMu.Lock()
 	defer n.raftMu.Unlock()
-	if n.initialized() {
+	if n.canStep() {
 		hasEvent, err := n.handleEvents()
 		if err != nil {
 			return pb.Update{}, false, err
 		}
+		n.wakeTicker()
 		if hasEvent {
 			if n.qs.newQuiesceState() {
 				n.sendEnterQuiesceMessages()
@@ -1159,7 +2163,10 @@ func (n *node) stepNode() (pb.Update, bool, error) {
 }
 
 func (n *node) handleEvents() (bool, error) {
-	hasEvent := false
+	hasEvent, err := n.catchUpTicks()
+	if err != nil {
+		return false, err
+	}
 	lastApplied := n.updateAppliedIndex()
 	if lastApplied != n.confirmedIndex {
 		hasEvent = true
@@ -1215,6 +2222,10 @@ func (n *node) handleEvents() (bool, error) {
 	if event {
 		hasEvent = true
 	}
+	if n.handleQuiesceRequest() {
+		hasEvent = true
+	}
+	n.handleRaftStateDump()
 	n.gc()
 	if hasEvent {
 		n.pendingReadIndexes.applied(lastApplied)
@@ -1283,7 +2294,10 @@ func (n *node) handleProposals() (bool, error) {
 		n.logDBLimited = logDBBusy
 		plog.Infof("%s new LogDB busy state is %t", n.id(), logDBBusy)
 	}
-	paused := logDBBusy || n.rateLimited
+	paused := logDBBusy || n.rateLimited || n.isDiskFull()
+	if !paused && n.proposalsHeldBack() {
+		return false, nil
+	}
 	if entries := n.incomingProposals.get(paused); len(entries) > 0 {
 		if err := n.p.ProposeEntries(entries); err != nil {
 			return false, err
@@ -1293,7 +2307,30 @@ func (n *node) handleProposals() (bool, error) {
 	return false, nil
 }
 
+// proposalsHeldBack returns a boolean value indicating whether proposals
+// queued on the leader are held back by proposal batching. The shard is
+// stepped again once the batch delay has passed.
+func (n *node) proposalsHeldBack() bool {
+	if n.incomingProposals.batchDelay == 0 || !n.isLeader() {
+		return false
+	}
+	wait := n.incomingProposals.heldBack()
+	if wait == 0 {
+		return false
+	}
+	if atomic.CompareAndSwapUint32(&n.proposalBatchWaiting, 0, 1) {
+		time.AfterFunc(wait, func() {
+			atomic.StoreUint32(&n.proposalBatchWaiting, 0)
+			n.pipeline.setStepReady(n.shardID)
+		})
+	}
+	return true
+}
+
 func (n *node) handleReadIndex() (bool, error) {
+	if !n.pendingReadIndexes.canRequest() {
+		return false, nil
+	}
 	if reqs := n.incomingReadIndexes.get(); len(reqs) > 0 {
 		n.qs.record(pb.ReadIndex)
 		ctx := n.pendingReadIndexes.nextCtx()
@@ -1353,6 +2390,8 @@ func (n *node) handleReceivedMessages() (bool, error) {
 			count++
 		} else if m.Type == pb.Replicate && busy {
 			continue
+		} else if n.dropSnapshotWhenUninitialized(m) {
+			continue
 		}
 		done, err := n.handleMessage(m)
 		if err != nil {
@@ -1360,6 +2399,9 @@ func (n *node) handleReceivedMessages() (bool, error) {
 		}
 		if !done {
 			n.recordMessage(m)
+			if m.Type == pb.Heartbeat {
+				n.observeHeartbeat(m)
+			}
 			if err := n.p.Handle(m); err != nil {
 				return false, err
 			}
@@ -1379,11 +2421,11 @@ func (n *node) handleReceivedMessages() (bool, error) {
 func (n *node) handleMessage(m pb.Message) (bool, error) {
 	switch m.Type {
 	case pb.LocalTick:
-		if err := n.tick(m.Hint); err != nil {
+		if _, err := n.tickTo(m.Hint); err != nil {
 			return false, err
 		}
 	case pb.Quiesce:
-		n.qs.tryEnterQuiesce()
+		n.qs.tryEnterQuiesce(m.Hint > 0)
 	case pb.SnapshotStatus:
 		plog.Debugf("%s got ReportSnapshot from %d, rejected %t",
 			n.id(), m.From, m.Reject)
@@ -1406,7 +2448,10 @@ func (n *node) setInitialStatus(index uint64) {
 	}
 	plog.Infof("%s initial index set to %d", n.id(), index)
 	n.ss.setIndex(index)
-	n.pushedIndex = index
+	// entries might have been pushed when LazyReplay is enabled
+	if index > n.pushedIndex {
+		n.pushedIndex = index
+	}
 	n.setInitialized()
 }
 
@@ -1562,6 +2607,18 @@ func (n *node) processStreamStatus() bool {
 func (n *node) tick(tick uint64) error {
 	n.currentTick++
 	n.qs.tick()
+	n.trackApplyProgress()
+	if err := n.checkDegradedLeader(); err != nil {
+		return err
+	}
+	n.checkLogRetention()
+	n.retryDeferredCompaction()
+	if err := n.removeRetainedLog(); err != nil {
+		return err
+	}
+	if n.snapshotIntervalReached() || n.membershipChangeSnapshotRequired() {
+		n.pushTakeSnapshotRequest(rsm.SSRequest{})
+	}
 	if n.qs.quiesced() {
 		if err := n.p.QuiescedTick(); err != nil {
 			return err
@@ -1578,12 +2635,115 @@ func (n *node) tick(tick uint64) error {
 	return nil
 }
 
-func (n *node) notifySelfRemove() {
+// tickTo ticks the node up to the specified tick of the tick worker. Ticks
+// skipped while the node was kept idle by the tick scheduler are ticked first,
+// ticks already caught up are ignored.
+func (n *node) tickTo(tick uint64) (bool, error) {
+	if tick == 0 {
+		return true, n.tick(tick)
+	}
+	if tick <= n.lastTick {
+		return false, nil
+	}
+	from := tick
+	if n.lastTick > 0 {
+		from = n.lastTick + 1
+	}
+	n.lastTick = tick
+	for t := from; t <= tick; t++ {
+		if err := n.tick(t); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// catchUpTicks ticks the quiesced node for ticks skipped by the tick scheduler
+// so far. It is invoked before handling any event, skipped ticks are thus
+// always handled as quiesced ticks before the node exits quiesce mode.
+func (n *node) catchUpTicks() (bool, error) {
+	if n.ticker == nil || !n.qs.quiesced() {
+		return false, nil
+	}
+	return n.tickTo(n.ticker.getTick())
+}
+
+// tryIdleTicking marks the node as kept idle by the tick scheduler when it is
+// in quiesce mode. It is invoked by the tick worker.
+func (n *node) tryIdleTicking() bool {
+	atomic.StoreUint32(&n.idleTicking, 1)
+	if n.qs.isQuiesced() {
+		return true
+	}
+	// the node might have been woken up concurrently, it is ignored by the tick
+	// scheduler as the node is not idle
+	atomic.CompareAndSwapUint32(&n.idleTicking, 1, 0)
+	return false
+}
+
+// wakeTicker has the node ticked in every tick again once it exited quiesce
+// mode while kept idle by the tick scheduler.
+func (n *node) wakeTicker() {
+	if atomic.LoadUint32(&n.idleTicking) == 1 && !n.qs.quiesced() &&
+		atomic.CompareAndSwapUint32(&n.idleTicking, 1, 0) {
+		n.ticker.wake(n)
+	}
+}
+
+// selfRemoved stops the replica after it learned that it has been removed
+// from the shard by the config change with the specified index, either by
+// applying the config change entry or by recovering from a snapshot.
+// Proposals and reads made on the replica are rejected with ErrReplicaRemoved
+// afterwards.
+func (n *node) selfRemoved(index uint64) {
+	atomic.StoreUint64(&n.removedIndex, index)
+	n.requestRemoval()
+	n.notifySelfRemove(index)
+}
+
+// removed returns a boolean value indicating whether the replica is known to
+// have been removed from the shard.
+func (n *node) removed() bool {
+	return atomic.LoadUint64(&n.removedIndex) > 0
+}
+
+func (n *node) notifySelfRemove(index uint64) {
 	n.sysEvents.Publish(server.SystemEvent{
 		Type:      server.NodeDeleted,
 		ShardID:   n.shardID,
 		ReplicaID: n.replicaID,
 	})
+	n.sysEvents.Publish(server.SystemEvent{
+		Type:      server.NodeRemovedFromShard,
+		ShardID:   n.shardID,
+		ReplicaID: n.replicaID,
+		Index:     index,
+	})
+}
+
+func (n *node) notifyMembershipChange(cc pb.ConfigChange) {
+	if n.membershipQ == nil {
+		return
+	}
+	m := n.sm.GetMembership()
+	removed := make(map[uint64]struct{})
+	for nid := range m.Removed {
+		removed[nid] = struct{}{}
+	}
+	n.membershipQ.addMembershipChange(raftio.MembershipChangeInfo{
+		ShardID:          n.shardID,
+		ReplicaID:        n.replicaID,
+		Index:            m.ConfigChangeId,
+		Type:             cc.Type,
+		ChangedReplicaID: cc.ReplicaID,
+		Address:          cc.Address,
+		Nodes:            m.Addresses,
+		NonVotings:       m.NonVotings,
+		Witnesses:        m.Witnesses,
+		Outgoing:         m.Outgoing,
+		Removed:          removed,
+		Replayed:         m.ConfigChangeId <= n.replayedIndex,
+	})
 }
 
 func (n *node) notifyConfigChange() {
@@ -1600,6 +2760,8 @@ func (n *node) notifyConfigChange() {
 		IsWitness:         isWitness,
 		ConfigChangeIndex: m.ConfigChangeId,
 		Replicas:          m.Addresses,
+		NonVotings:        m.NonVotings,
+		Witnesses:         m.Witnesses,
 	}
 	n.shardInfo.Store(ci)
 	n.sysEvents.Publish(server.SystemEvent{
@@ -1616,11 +2778,20 @@ func (n *node) getShardInfo() ShardInfo {
 			ShardID:          n.shardID,
 			ReplicaID:        n.replicaID,
 			Pending:          true,
-			StateMachineType: sm.Type(n.sm.Type()),
+			StateMachineType: n.stateMachineType(),
 		}
 	}
 	info := v.(*ShardInfo)
 
+	receiving := false
+	percent := uint64(0)
+	if rv := n.snapshotReceiveInfo.Load(); rv != nil {
+		if ri := rv.(*snapshotReceiveInfo); ri != nil {
+			receiving = true
+			percent = getSnapshotPercentComplete(ri.received, ri.total)
+		}
+	}
+
 	leaderID := uint64(0)
 	term := uint64(0)
 	lv := n.leaderInfo.Load()
@@ -1630,16 +2801,60 @@ func (n *node) getShardInfo() ShardInfo {
 		term = leaderInfo.term
 	}
 
+	retained, retainedSize := n.snapshotter.getRetainedStats()
 	return ShardInfo{
-		ShardID:           info.ShardID,
-		ReplicaID:         info.ReplicaID,
-		LeaderID:          leaderID,
-		Term:              term,
-		IsNonVoting:       info.IsNonVoting,
-		ConfigChangeIndex: info.ConfigChangeIndex,
-		Replicas:          info.Replicas,
-		StateMachineType:  sm.Type(n.sm.Type()),
+		ShardID:                 info.ShardID,
+		ReplicaID:               info.ReplicaID,
+		LeaderID:                leaderID,
+		Term:                    term,
+		IsNonVoting:             info.IsNonVoting,
+		ConfigChangeIndex:       info.ConfigChangeIndex,
+		Replicas:                info.Replicas,
+		NonVotings:              info.NonVotings,
+		Witnesses:               info.Witnesses,
+		StateMachineType:        n.stateMachineType(),
+		IsStandby:               n.isStandby(),
+		IsRemoved:               n.removed(),
+		ReceivingSnapshot:       receiving,
+		SnapshotPercentComplete: percent,
+		ApplyLag:                atomic.LoadUint64(&n.applyLag),
+		ApplyStallDuration:      n.getApplyStallDuration(),
+		Quiesced:                n.qs.isQuiesced(),
+		RetainedSnapshots:       retained,
+		RetainedSnapshotSize:    retainedSize,
+		SnapshotQueuePosition:   n.getSnapshotQueuePosition(),
+	}
+}
+
+func (n *node) setSnapshotReceiveInfo(received uint64, total uint64) {
+	n.snapshotReceiveInfo.Store(&snapshotReceiveInfo{
+		received: received,
+		total:    total,
+	})
+}
+
+func (n *node) clearSnapshotReceiveInfo() {
+	n.snapshotReceiveInfo.Store((*snapshotReceiveInfo)(nil))
+}
+
+// setSnapshotQueuePosition sets the position of the replica in the queue of
+// replicas waiting to save or recover snapshots, 0 means not waiting.
+func (n *node) setSnapshotQueuePosition(pos uint64) {
+	atomic.StoreUint64(&n.ssQueuePosition, pos)
+}
+
+func (n *node) getSnapshotQueuePosition() uint64 {
+	return atomic.LoadUint64(&n.ssQueuePosition)
+}
+
+func getSnapshotPercentComplete(received uint64, total uint64) uint64 {
+	if total == 0 {
+		return 0
+	}
+	if received >= total {
+		return 100
 	}
+	return received * 100 / total
 }
 
 func (n *node) logDBBusy() bool {
@@ -1650,6 +2865,14 @@ func (n *node) logDBBusy() bool {
 	return n.metrics.isBusy()
 }
 
+// logFields returns the fields attached to structured log records.
+func (n *node) logFields() []logger.Field {
+	return []logger.Field{
+		logger.ShardID(n.shardID),
+		logger.ReplicaID(n.replicaID),
+	}
+}
+
 func (n *node) id() string {
 	return dn(n.shardID, n.replicaID)
 }
@@ -21,9 +21,11 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/cockroachdb/errors"
 	"github.com/lni/goutils/leaktest"
 	"github.com/lni/goutils/random"
 
@@ -161,13 +163,14 @@ func getTestRaftNodes(count int, ordered bool,
 type dummyEngine struct {
 }
 
-func (d *dummyEngine) setCloseReady(n *node)          {}
-func (d *dummyEngine) setStepReady(shardID uint64)    {}
-func (d *dummyEngine) setCommitReady(shardID uint64)  {}
-func (d *dummyEngine) setApplyReady(shardID uint64)   {}
-func (d *dummyEngine) setStreamReady(shardID uint64)  {}
-func (d *dummyEngine) setSaveReady(shardID uint64)    {}
-func (d *dummyEngine) setRecoverReady(shardID uint64) {}
+func (d *dummyEngine) setCloseReady(n *node)               {}
+func (d *dummyEngine) setStepReady(shardID uint64)         {}
+func (d *dummyEngine) setStepReadyDeferred(shardID uint64) {}
+func (d *dummyEngine) setCommitReady(shardID uint64)       {}
+func (d *dummyEngine) setApplyReady(shardID uint64)        {}
+func (d *dummyEngine) setStreamReady(shardID uint64)       {}
+func (d *dummyEngine) setSaveReady(shardID uint64)         {}
+func (d *dummyEngine) setRecoverReady(shardID uint64)      {}
 
 func doGetTestRaftNodes(startID uint64, count int, ordered bool,
 	ldb raftio.ILogDB, fs vfs.IFS) ([]*node, []*rsm.StateMachine,
@@ -224,7 +227,7 @@ func doGetTestRaftNodes(startID uint64, count int, ordered bool,
 			return snapdir
 		}
 		lr := logdb.NewLogReader(testShardID, i, ldb)
-		snapshotter := newSnapshotter(testShardID, i, rootDirFunc, ldb, lr, fs)
+		snapshotter := newSnapshotter(testShardID, i, rootDirFunc, ldb, lr, fs, 1)
 		lr.SetCompactor(snapshotter)
 		// create the sm
 		noopSM := &tests.NoOP{}
@@ -257,12 +260,13 @@ func doGetTestRaftNodes(startID uint64, count int, ordered bool,
 			nil,
 			nil,
 			nil,
+			nil,
 			router.send,
 			nr,
 			requestStatePool,
 			ldb,
 			nil,
-			newSysEventListener(nil, nil))
+			newSysEventListener(nil, 0))
 		if err != nil {
 			panic(err)
 		}
@@ -314,7 +318,7 @@ func step(nodes []*node) bool {
 		if err := node.processSnapshot(ud); err != nil {
 			panic(err)
 		}
-		node.applyRaftUpdates(ud)
+		node.applyRaftUpdates(ud, true)
 		node.sendReplicateMessages(ud)
 		node.processReadyToRead(ud)
 		node.processLeaderUpdate(ud.LeaderUpdate)
@@ -335,7 +339,7 @@ func step(nodes []*node) bool {
 				panic(err)
 			}
 		}
-		rec, err := node.sm.Handle(make([]rsm.Task, 0), nil)
+		rec, err := node.sm.Handle(make([]rsm.Task, 0))
 		if err != nil {
 			panic(err)
 		}
@@ -454,7 +458,7 @@ func getProposalTestClient(n *node,
 	router *testRouter) (*client.Session, bool) {
 	cs := client.NewSession(n.shardID, random.NewLockedRand())
 	cs.PrepareForRegister()
-	rs, err := n.pendingProposals.propose(cs, nil, 50)
+	rs, err := n.pendingProposals.propose(context.Background(), cs, nil, 50)
 	if err != nil {
 		plog.Errorf("error: %v", err)
 		return nil, false
@@ -479,7 +483,7 @@ func closeProposalTestClient(n *node,
 	nodes []*node, smList []*rsm.StateMachine,
 	router *testRouter, session *client.Session) {
 	session.PrepareForUnregister()
-	rs, err := n.pendingProposals.propose(session, nil, 50)
+	rs, err := n.pendingProposals.propose(context.Background(), session, nil, 50)
 	if err != nil {
 		return
 	}
@@ -500,7 +504,7 @@ func makeCheckedTestProposal(t *testing.T, session *client.Session,
 	expectedCode RequestResultCode, checkResult bool, expectedResult uint64) {
 	n := mustHasLeaderNode(nodes, t)
 	tick := uint64(50)
-	rs, err := n.propose(session, data, tick)
+	rs, err := n.propose(context.Background(), session, data, tick)
 	if err != nil {
 		t.Fatalf("failed to make proposal")
 	}
@@ -512,7 +516,7 @@ func makeCheckedTestProposal(t *testing.T, session *client.Session,
 		}
 		if checkResult {
 			if v.GetResult().Value != expectedResult {
-				t.Errorf("result %d, want %d", v.GetResult(), expectedResult)
+				t.Errorf("result %d, want %d", v.GetResult().Value, expectedResult)
 			}
 		}
 	default:
@@ -708,7 +712,7 @@ func TestReadOnWitnessWillBeRejected(t *testing.T) {
 		smList []*rsm.StateMachine, router *testRouter, ldb raftio.ILogDB) {
 		n := nodes[0]
 		n.config.IsWitness = true
-		_, err := n.read(10)
+		_, err := n.read(context.Background(), 10)
 		if err != ErrInvalidOperation {
 			t.Errorf("read not rejected")
 		}
@@ -723,7 +727,7 @@ func TestMakingProposalOnWitnessNodeWillBeRejected(t *testing.T) {
 		n := nodes[0]
 		n.config.IsWitness = true
 		cs := client.NewNoOPSession(n.shardID, random.NewLockedRand())
-		_, err := n.propose(cs, make([]byte, 1), 10)
+		_, err := n.propose(context.Background(), cs, make([]byte, 1), 10)
 		if err != ErrInvalidOperation {
 			t.Errorf("making proposal not rejected")
 		}
@@ -845,7 +849,7 @@ func TestReproposeRespondedDataWillTimeout(t *testing.T) {
 		}
 		data := []byte("test-data")
 		maxLastApplied := getMaxLastApplied(smList)
-		_, err := n.propose(session, data, 10)
+		_, err := n.propose(context.Background(), session, data, 10)
 		if err != nil {
 			t.Fatalf("failed to make proposal")
 		}
@@ -864,7 +868,7 @@ func TestReproposeRespondedDataWillTimeout(t *testing.T) {
 		session.SeriesID = respondedSeriesID
 		plog.Infof("series id %d, responded to %d",
 			session.SeriesID, session.RespondedTo)
-		rs, _ := n.propose(session, data, 10)
+		rs, _ := n.propose(context.Background(), session, data, 10)
 		stepNodes(nodes, smList, router, 10)
 		select {
 		case v := <-rs.ResultC():
@@ -885,27 +889,27 @@ func TestProposalsWithIllFormedSessionAreChecked(t *testing.T) {
 		n := nodes[0]
 		s1 := client.NewSession(n.shardID, random.NewLockedRand())
 		s1.SeriesID = client.SeriesIDForRegister
-		_, err := n.propose(s1, nil, 10)
+		_, err := n.propose(context.Background(), s1, nil, 10)
 		if err != ErrInvalidSession {
 			t.Errorf("not rejected")
 		}
 		s1 = client.NewSession(n.shardID, random.NewLockedRand())
 		s1.SeriesID = client.SeriesIDForUnregister
-		_, err = n.propose(s1, nil, 10)
+		_, err = n.propose(context.Background(), s1, nil, 10)
 		if err != ErrInvalidSession {
 			t.Errorf("not rejected")
 		}
 		s1 = client.NewSession(n.shardID, random.NewLockedRand())
 		s1.SeriesID = 100
 		s1.ShardID = 123456
-		_, err = n.propose(s1, nil, 10)
+		_, err = n.propose(context.Background(), s1, nil, 10)
 		if err != ErrInvalidSession {
 			t.Errorf("not rejected")
 		}
 		s1 = client.NewSession(n.shardID, random.NewLockedRand())
 		s1.SeriesID = 1
 		s1.ClientID = 0
-		_, err = n.propose(s1, nil, 10)
+		_, err = n.propose(context.Background(), s1, nil, 10)
 		if err != ErrInvalidSession {
 			t.Errorf("not rejected")
 		}
@@ -927,7 +931,7 @@ func TestProposalsWithCorruptedSessionWillPanic(t *testing.T) {
 				t.Errorf("panic not triggered")
 			}
 		}()
-		_, err := n.propose(s1, nil, 10)
+		_, err := n.propose(context.Background(), s1, nil, 10)
 		if err != nil {
 			t.Fatalf("failed to make proposal %v", err)
 		}
@@ -992,6 +996,45 @@ func TestNodesCanEnterQuiesce(t *testing.T) {
 	runRaftNodeTest(t, true, false, tf, fs)
 }
 
+func TestQuiescedNodeCatchesUpSkippedTicks(t *testing.T) {
+	tf := func(t *testing.T, nodes []*node,
+		smList []*rsm.StateMachine, router *testRouter, ldb raftio.ILogDB) {
+		for i := uint64(0); i <= nodes[0].qs.threshold()*2; i++ {
+			singleStepNodes(nodes, smList, router)
+		}
+		n := nodes[0]
+		if !n.qs.quiesced() {
+			t.Fatalf("node failed to enter quiesced")
+		}
+		n.ticker = newTickScheduler()
+		n.ticker.tick = n.lastTick + 7
+		currentTick := n.currentTick
+		step([]*node{n})
+		if n.currentTick != currentTick+7 {
+			t.Errorf("current tick %d, want %d", n.currentTick, currentTick+7)
+		}
+		if n.lastTick != n.ticker.tick {
+			t.Errorf("last tick %d, want %d", n.lastTick, n.ticker.tick)
+		}
+		// tick messages already caught up are ignored
+		router.send(pb.Message{
+			Type:    pb.LocalTick,
+			To:      n.replicaID,
+			ShardID: testShardID,
+			Hint:    n.lastTick,
+		})
+		step([]*node{n})
+		if n.currentTick != currentTick+7 {
+			t.Errorf("caught up tick handled again")
+		}
+		if !n.qs.quiesced() {
+			t.Errorf("node unexpectedly exited quiesce")
+		}
+	}
+	fs := vfs.GetTestFS()
+	runRaftNodeTest(t, true, false, tf, fs)
+}
+
 func TestNodesCanExitQuiesceByMakingProposal(t *testing.T) {
 	tf := func(t *testing.T, nodes []*node,
 		smList []*rsm.StateMachine, router *testRouter, ldb raftio.ILogDB) {
@@ -1044,7 +1087,7 @@ func TestNodesCanExitQuiesceByReadIndex(t *testing.T) {
 			}
 		}
 		n := nodes[0]
-		rs, err := n.read(10)
+		rs, err := n.read(context.Background(), 10)
 		if err != nil {
 			t.Errorf("failed to read")
 		}
@@ -1133,14 +1176,14 @@ func TestLinearizableReadCanBeMade(t *testing.T) {
 			t.Errorf("failed to get session")
 			return
 		}
-		rs, err := n.propose(session, []byte("test-data"), 10)
+		rs, err := n.propose(context.Background(), session, []byte("test-data"), 10)
 		if err != nil {
 			t.Fatalf("failed to make proposal")
 		}
 		stepNodes(nodes, smList, router, 10)
 		mustComplete(rs, t)
 		closeProposalTestClient(n, nodes, smList, router, session)
-		rs, err = n.read(10)
+		rs, err = n.read(context.Background(), 10)
 		if err != nil {
 			t.Fatalf("")
 		}
@@ -1206,6 +1249,65 @@ func TestNodeCanBeDeleted(t *testing.T) {
 	runRaftNodeTest(t, false, false, tf, fs)
 }
 
+func TestSelfRemovalCanBeLearnedFromSnapshot(t *testing.T) {
+	tf := func(t *testing.T, nodes []*node,
+		smList []*rsm.StateMachine, router *testRouter, ldb raftio.ILogDB) {
+		leader := mustHasLeaderNode(nodes, t)
+		var removed *node
+		others := make([]*node, 0)
+		otherSMList := make([]*rsm.StateMachine, 0)
+		for i, n := range nodes {
+			if n != leader && removed == nil {
+				removed = n
+				continue
+			}
+			others = append(others, n)
+			otherSMList = append(otherSMList, smList[i])
+		}
+		// the removed replica is not stepped, it never applies its removal
+		rs, err := leader.requestDeleteNodeWithOrderID(removed.replicaID, 0, 10)
+		if err != nil {
+			t.Fatalf("request to delete node failed")
+		}
+		stepNodes(others, otherSMList, router, 10)
+		mustComplete(rs, t)
+		if removed.stopped() || removed.removed() {
+			t.Fatalf("node unexpectedly removed")
+		}
+		m := leader.sm.GetMembership()
+		ss := pb.Snapshot{
+			Index:      leader.sm.GetLastApplied(),
+			Membership: m,
+		}
+		if err := removed.RestoreRemotes(ss); err != nil {
+			t.Fatalf("failed to restore remotes %v", err)
+		}
+		if !removed.stopped() {
+			t.Errorf("node not stopped")
+		}
+		if v := atomic.LoadUint64(&removed.removedIndex); v != m.ConfigChangeId {
+			t.Errorf("removed index %d, want %d", v, m.ConfigChangeId)
+		}
+		if !removed.getShardInfo().IsRemoved {
+			t.Errorf("node not shown as removed")
+		}
+		session := client.NewNoOPSession(testShardID, random.LockGuardedRand)
+		if _, err := removed.propose(context.Background(),
+			session, []byte("test-data"), 10); !errors.Is(err, ErrReplicaRemoved) {
+			t.Errorf("unexpected propose error %v", err)
+		}
+		if _, err := removed.read(context.Background(),
+			10); !errors.Is(err, ErrReplicaRemoved) {
+			t.Errorf("unexpected read error %v", err)
+		}
+		if leader.removed() {
+			t.Errorf("leader unexpectedly removed")
+		}
+	}
+	fs := vfs.GetTestFS()
+	runRaftNodeTest(t, false, false, tf, fs)
+}
+
 func sliceEqual(s1 []uint64, s2 []uint64) bool {
 	if len(s1) != len(s2) {
 		return false
@@ -1231,7 +1333,7 @@ func TestNodeCanBeAdded2(t *testing.T) {
 			return
 		}
 		for i := 0; i < 5; i++ {
-			rs, err := n.propose(session, []byte("test-data"), 10)
+			rs, err := n.propose(context.Background(), session, []byte("test-data"), 10)
 			if err != nil {
 				t.Fatalf("")
 			}
@@ -1386,7 +1488,7 @@ func TestSnapshotCanBeMade(t *testing.T) {
 		proposalCount := 50
 		for i := 0; i < proposalCount; i++ {
 			data := fmt.Sprintf("test-data-%d", i)
-			rs, err := n.propose(session, []byte(data), 10)
+			rs, err := n.propose(context.Background(), session, []byte(data), 10)
 			if err != nil {
 				t.Fatalf("failed to make proposal")
 			}
@@ -1427,7 +1529,7 @@ func TestSnapshotCanBeMadeTwice(t *testing.T) {
 		proposalCount := 50
 		for i := 0; i < proposalCount; i++ {
 			data := fmt.Sprintf("test-data-%d", i)
-			rs, err := n.propose(session, []byte(data), 10)
+			rs, err := n.propose(context.Background(), session, []byte(data), 10)
 			if err != nil {
 				t.Fatalf("failed to make proposal")
 			}
@@ -1470,7 +1572,7 @@ func TestNodesCanBeRestarted(t *testing.T) {
 	}
 	maxLastApplied := getMaxLastApplied(smList)
 	for i := 0; i < 25; i++ {
-		rs, err := n.propose(session, []byte("test-data"), 10)
+		rs, err := n.propose(context.Background(), session, []byte("test-data"), 10)
 		if err != nil {
 			t.Fatalf("")
 		}
@@ -1575,13 +1677,14 @@ func TestPayloadTooBig(t *testing.T) {
 
 type dummyPipeline struct{}
 
-func (d *dummyPipeline) setCloseReady(*node)            {}
-func (d *dummyPipeline) setStepReady(shardID uint64)    {}
-func (d *dummyPipeline) setCommitReady(shardID uint64)  {}
-func (d *dummyPipeline) setApplyReady(shardID uint64)   {}
-func (d *dummyPipeline) setStreamReady(shardID uint64)  {}
-func (d *dummyPipeline) setSaveReady(shardID uint64)    {}
-func (d *dummyPipeline) setRecoverReady(shardID uint64) {}
+func (d *dummyPipeline) setCloseReady(*node)                 {}
+func (d *dummyPipeline) setStepReady(shardID uint64)         {}
+func (d *dummyPipeline) setStepReadyDeferred(shardID uint64) {}
+func (d *dummyPipeline) setCommitReady(shardID uint64)       {}
+func (d *dummyPipeline) setApplyReady(shardID uint64)        {}
+func (d *dummyPipeline) setStreamReady(shardID uint64)       {}
+func (d *dummyPipeline) setSaveReady(shardID uint64)         {}
+func (d *dummyPipeline) setRecoverReady(shardID uint64)      {}
 
 func TestProcessUninitilizedNode(t *testing.T) {
 	n := &node{ss: snapshotState{}, pipeline: &dummyPipeline{}}
@@ -1622,7 +1725,7 @@ func TestProcessTakingSnapshotNodeCanBeSkipped(t *testing.T) {
 func TestRecoveringFromSnapshotNodeCanComplete(t *testing.T) {
 	n := &node{
 		ss:           snapshotState{},
-		sysEvents:    newSysEventListener(nil, nil),
+		sysEvents:    newSysEventListener(nil, 0),
 		initializedC: make(chan struct{}),
 	}
 	n.ss.setRecovering()
@@ -1642,7 +1745,7 @@ func TestRecoveringFromSnapshotNodeCanComplete(t *testing.T) {
 }
 
 func TestNotReadyRecoveringFromSnapshotNode(t *testing.T) {
-	n := &node{ss: snapshotState{}, sysEvents: newSysEventListener(nil, nil)}
+	n := &node{ss: snapshotState{}, sysEvents: newSysEventListener(nil, 0)}
 	n.ss.setRecovering()
 	if !n.processRecoverStatus() {
 		t.Errorf("not skipped")
@@ -1707,13 +1810,16 @@ func TestGetCompactionIndex(t *testing.T) {
 
 type testDummyNodeProxy struct{}
 
-func (np *testDummyNodeProxy) StepReady()                                            {}
-func (np *testDummyNodeProxy) RestoreRemotes(pb.Snapshot) error                      { return nil }
-func (np *testDummyNodeProxy) ApplyUpdate(pb.Entry, sm.Result, bool, bool, bool)     {}
-func (np *testDummyNodeProxy) ApplyConfigChange(pb.ConfigChange, uint64, bool) error { return nil }
-func (np *testDummyNodeProxy) ReplicaID() uint64                                     { return 1 }
-func (np *testDummyNodeProxy) ShardID() uint64                                       { return 1 }
-func (np *testDummyNodeProxy) ShouldStop() <-chan struct{}                           { return nil }
+func (np *testDummyNodeProxy) StepReady()                                        {}
+func (np *testDummyNodeProxy) RestoreRemotes(pb.Snapshot) error                  { return nil }
+func (np *testDummyNodeProxy) ApplyUpdate(pb.Entry, sm.Result, bool, bool, bool) {}
+func (np *testDummyNodeProxy) ApplyConfigChange(pb.ConfigChange, uint64, bool, error) error {
+	return nil
+}
+func (np *testDummyNodeProxy) EntriesApplied([]pb.Entry)   {}
+func (np *testDummyNodeProxy) ReplicaID() uint64           { return 1 }
+func (np *testDummyNodeProxy) ShardID() uint64             { return 1 }
+func (np *testDummyNodeProxy) ShouldStop() <-chan struct{} { return nil }
 
 func TestNotReadyTakingSnapshotNodeIsSkippedWhenConcurrencyIsNotSupported(t *testing.T) {
 	fs := vfs.GetTestFS()
@@ -1795,16 +1901,16 @@ func TestUninitializedNodeNotAllowedToMakeRequests(t *testing.T) {
 	if n.initialized() {
 		t.Fatalf("already initialized")
 	}
-	if _, err := n.propose(nil, nil, 1); err != ErrShardNotReady {
+	if _, err := n.propose(context.Background(), nil, nil, 1); err != ErrShardNotReady {
 		t.Fatalf("making proposal not rejected")
 	}
 	if _, err := n.proposeSession(nil, 1); err != ErrShardNotReady {
 		t.Fatalf("propose session not rejected")
 	}
-	if _, err := n.read(1); err != ErrShardNotReady {
+	if _, err := n.read(context.Background(), 1); err != ErrShardNotReady {
 		t.Fatalf("read not rejected")
 	}
-	if err := n.requestLeaderTransfer(1); err != ErrShardNotReady {
+	if err := n.requestLeaderTransfer(1, LeaderTransferOption{}); err != ErrShardNotReady {
 		t.Fatalf("leader transfer request not rejected")
 	}
 	if _, err := n.requestSnapshot(SnapshotOption{}, 1); err != ErrShardNotReady {
@@ -1857,3 +1963,77 @@ func TestEntriesToApply(t *testing.T) {
 		}()
 	}
 }
+
+func TestSnapshotPercentComplete(t *testing.T) {
+	tests := []struct {
+		received uint64
+		total    uint64
+		percent  uint64
+	}{
+		{0, 0, 0},
+		{100, 0, 0},
+		{0, 100, 0},
+		{50, 100, 50},
+		{999, 1000, 99},
+		{1000, 1000, 100},
+		{1500, 1000, 100},
+	}
+	for idx, tt := range tests {
+		if v := getSnapshotPercentComplete(tt.received, tt.total); v != tt.percent {
+			t.Errorf("%d, got %d, want %d", idx, v, tt.percent)
+		}
+	}
+}
+
+func TestPersistedCommittedEntriesAreAppliedBeforeSave(t *testing.T) {
+	getEntries := func(first uint64, last uint64) []pb.Entry {
+		var ents []pb.Entry
+		for i := first; i <= last; i++ {
+			ents = append(ents, pb.Entry{Index: i, Term: 1})
+		}
+		return ents
+	}
+	tests := []struct {
+		ud     pb.Update
+		pushed uint64
+		early  uint64
+	}{
+		{pb.Update{CommittedEntries: getEntries(1, 10),
+			EntriesToSave: getEntries(8, 12)}, 0, 7},
+		{pb.Update{CommittedEntries: getEntries(8, 10),
+			EntriesToSave: getEntries(8, 12)}, 7, 7},
+		{pb.Update{CommittedEntries: getEntries(6, 10),
+			EntriesToSave: getEntries(8, 12),
+			Snapshot:      pb.Snapshot{Index: 5, Term: 1}}, 5, 5},
+	}
+	for idx, tt := range tests {
+		lr := logdb.NewLogReader(1, 1, nil)
+		lr.SetRange(1, 7)
+		n := &node{
+			toApplyQ:    rsm.NewTaskQueue(),
+			logReader:   lr,
+			pushedIndex: tt.pushed,
+		}
+		n.applyPersistedEntries(tt.ud)
+		if n.pushedIndex != tt.early {
+			t.Errorf("%d, pushed index %d, want %d", idx, n.pushedIndex, tt.early)
+		}
+		lr.SetRange(8, 5)
+		n.applyRaftUpdates(tt.ud, true)
+		if n.pushedIndex != 10 {
+			t.Errorf("%d, pushed index %d, want 10", idx, n.pushedIndex)
+		}
+		next := tt.pushed + 1
+		for _, task := range n.toApplyQ.GetAll() {
+			for _, e := range task.Entries {
+				if e.Index != next {
+					t.Fatalf("%d, pushed entry %d, want %d", idx, e.Index, next)
+				}
+				next++
+			}
+		}
+		if next != 11 {
+			t.Errorf("%d, entries up to %d pushed", idx, next-1)
+		}
+	}
+}
@@ -52,6 +52,32 @@ semantic. For a client, when it retries the proposal that failed to complete by
 its deadline, it faces the risk of having the same proposal committed and
 applied twice into the user state machine. Dragonboat prevents this by
 implementing the client session concept described in Diego Ongaro's PhD thesis.
+
+NodeHost instances can be upgraded to a newer version of dragonboat one at a
+time. Replicas advertise the version of the Raft protocol they support to their
+leaders, membership changes requested by RequestReconfigure,
+RequestReplaceReplica, RequestPromoteWitness, RequestUpdateReplicaAddress and
+SyncReseedWitness can't be applied by replicas running older versions. Such
+requests are dropped by the leader, with ErrShardNotReady returned to the
+caller, until all members of the shard that are going to apply them have
+advertised support. Members removed, replaced or moved to a new address by the
+request are not required to be available.
+
+Membership change rules introduced along with the above, i.e. rejections by
+ErrUnsafeMembershipChange, ErrTooManyWitnesses, ErrTooManyNonVotings and
+ErrMembershipTooLarge, AddReplicaOption.AllowReplicaIDReuse and the pruning of
+removed replica IDs, are only applied once all members have advertised support,
+so all replicas make the same decisions when applying membership changes.
+Before that, requests that would be rejected as unsafe or as exceeding the
+configured limits, or that allow replica IDs to be reused, are dropped by the
+leader with ErrShardNotReady returned. Proposals made with a leader fence, see
+ProposeOption.Fence, are rejected with ErrShardNotReady in the same way.
+
+Some features change the encoding of Raft log entries and snapshots in ways
+that are not checked against the advertised versions, they must only be
+enabled once all NodeHost instances have been upgraded. See
+config.Config.PropagateRequestIDs and config.Config.MaxEntryChunkBytes for
+details.
 */
 package dragonboat // github.com/lni/dragonboat/v4
 
@@ -102,15 +128,24 @@ var (
 	streamConnections = settings.Soft.StreamConnections
 )
 
+// raftStateDumpTimeout is the time allowed for collecting Raft state dumps
+// when GetNodeHostInfo is invoked with NodeHostInfoOption.WithRaftState set.
+const raftStateDumpTimeout = 5 * time.Second
+
 var (
 	// ErrClosed is returned when a request is made on closed NodeHost instance.
 	ErrClosed = errors.New("dragonboat: closed")
-	// ErrReplicaRemoved indictes that the requested node has been removed.
+	// ErrReplicaRemoved indictes that the requested node has been removed. It
+	// is also returned for requests targeting a local replica that has been
+	// removed from its shard but not yet stopped using StopReplica.
 	ErrReplicaRemoved = errors.New("node removed")
 	// ErrShardNotFound indicates that the specified shard is not found.
 	ErrShardNotFound = errors.New("shard not found")
 	// ErrShardAlreadyExist indicates that the specified shard already exist.
 	ErrShardAlreadyExist = errors.New("shard already exist")
+	// ErrShardFrozen indicates that the local replica of the specified shard is
+	// frozen, see NodeHost.FreezeShard for details.
+	ErrShardFrozen = errors.New("shard is frozen")
 	// ErrShardNotStopped indicates that the specified shard is still running
 	// and thus prevented the requested operation to be completed.
 	ErrShardNotStopped = errors.New("shard not stopped")
@@ -137,6 +172,12 @@ var (
 	ErrLogDBNotCreatedOrClosed = errors.New("logdb is not created yet or closed already")
 	// ErrInvalidRange indicates that the specified log range is invalid.
 	ErrInvalidRange = errors.New("invalid log range")
+	// ErrGossipJoinFailed indicates that the gossip group can not be joined
+	// within the time budget specified by GossipConfig.JoinTimeout.
+	ErrGossipJoinFailed = registry.ErrJoinFailed
+	// ErrInvalidGossipKey indicates that the specified gossip key is invalid or
+	// can not be used for the requested keyring operation.
+	ErrInvalidGossipKey = registry.ErrInvalidKey
 )
 
 // ShardInfo is a record for representing the state of a Raft shard based
@@ -147,6 +188,22 @@ type ShardInfo = registry.ShardInfo
 // on the knowledge of distributed NodeHost instances as shared by gossip.
 type ShardView = registry.ShardView
 
+// ElectionStats contains the election and heartbeat timing statistics of a
+// replica, see NodeHost.GetElectionStats for details.
+type ElectionStats = server.ElectionStats
+
+// InMemLogRetention contains the size in bytes of log entries kept in memory by
+// a replica grouped by the reason they can not be released yet.
+type InMemLogRetention = server.InMemLogRetention
+
+// HeartbeatStats contains the heartbeat round-trip time statistics of a remote
+// replica as observed by the leader.
+type HeartbeatStats = server.HeartbeatStats
+
+// PeerTransportStats is a record for representing the transport statistics
+// of a remote NodeHost instance.
+type PeerTransportStats = transport.PeerStats
+
 // GossipInfo contains details of the gossip service.
 type GossipInfo struct {
 	// AdvertiseAddress is the advertise address used by the gossip service.
@@ -159,6 +216,14 @@ type GossipInfo struct {
 	NumOfKnownNodeHosts int
 	// Enabled is a boolean flag indicating whether the gossip service is enabled.
 	Enabled bool
+	// KeyFingerprints are fingerprints of keys used for encrypting gossip
+	// messages, the first one is the fingerprint of the primary key. It can be
+	// used for verifying the progress of key rotations without revealing the
+	// keys. It is empty when gossip messages are not encrypted.
+	KeyFingerprints []string
+	// Draining is a boolean flag indicating whether the NodeHost is advertised
+	// as draining, see NodeHost.SetDrainState for details.
+	Draining bool
 }
 
 // NodeHostInfo provides info about the NodeHost, including its managed Raft
@@ -176,6 +241,16 @@ type NodeHostInfo struct {
 	// LogInfo is a list of raftio.NodeInfo values representing all Raft logs
 	// stored on the NodeHost.
 	LogInfo []raftio.NodeInfo
+	// RaftStateList is a list of Raft state dumps of all Raft shards managed by
+	// the NodeHost, it is only populated when requested by setting the
+	// NodeHostInfoOption.WithRaftState flag.
+	RaftStateList []RaftStateDump
+	// SnapshotStaging is the disk space used by temp directories of snapshots
+	// being saved or received.
+	SnapshotStaging SnapshotStagingInfo
+	// ReadOnlyMode indicates whether the NodeHost is in the read-only mode, see
+	// config.NodeHostConfig.ReadOnlyMode for details.
+	ReadOnlyMode bool
 }
 
 // NodeHostInfoOption is the option type used when querying NodeHostInfo.
@@ -183,6 +258,10 @@ type NodeHostInfoOption struct {
 	// SkipLogInfo is the boolean flag indicating whether Raft Log info should be
 	// skipped when querying the NodeHostInfo.
 	SkipLogInfo bool
+	// WithRaftState is the boolean flag indicating whether the Raft state dump
+	// of each shard should be included when querying the NodeHostInfo. See
+	// NodeHost.DumpRaftState for details.
+	WithRaftState bool
 }
 
 // DefaultNodeHostInfoOption is the default NodeHostInfoOption value. It
@@ -194,8 +273,12 @@ var DefaultNodeHostInfoOption NodeHostInfoOption
 type SnapshotOption struct {
 	// ExportPath is the path where the exported snapshot should be stored, it
 	// must point to an existing directory for which the current user has write
-	// permission.
+	// permission. ExportPath must be empty when ExportSink is set.
 	ExportPath string
+	// ExportSink is the sink to which the exported snapshot is directly written
+	// when Exported is set to true, no local file is created in such case. See
+	// ExportSink for details.
+	ExportSink ExportSink
 	// CompactionOverhead is the compaction overhead value to use for the
 	// requested snapshot operation when OverrideCompactionOverhead is set to
 	// true. This field is ignored when exporting a snapshot. ErrInvalidOption
@@ -216,11 +299,52 @@ type SnapshotOption struct {
 	// should override the compaction overhead setting specified in node's config.
 	// This field is ignored when exporting a snapshot.
 	OverrideCompactionOverhead bool
+	// LeaderOnly indicates that the exported snapshot must only be created by
+	// the leader. SyncRequestSnapshot and SyncExportSnapshot called on a
+	// follower forward the request to the leader unless NoForwarding is set.
+	// Only exports to ExportPath can be forwarded, NotLeaderError is returned
+	// when a follower is requested to export to an ExportSink. The snapshot is
+	// aborted with LeaderChangedError when the leader loses its leadership
+	// before the snapshot is committed. Concurrent LeaderOnly exports of the
+	// same shard to ExportPath share a single snapshot, use SyncExportSnapshot
+	// to learn where it was exported. Requests are not forwarded to leaders
+	// running a version of dragonboat that predates forwarding, NotLeaderError
+	// is returned in such case. LeaderOnly requires Exported.
+	LeaderOnly bool
+	// NoForwarding indicates that a LeaderOnly request made on a follower
+	// should fail with NotLeaderError rather than being forwarded to the leader.
+	NoForwarding bool
+	// Prioritized indicates that the requested snapshot should be scheduled
+	// ahead of other snapshots waiting for their turn when the number of
+	// concurrent snapshots is limited, see
+	// config.ExpertConfig.MaxConcurrentSnapshots.
+	Prioritized bool
+	// SkipIfUnchanged indicates that the requested export should be skipped
+	// when the state machine, including its membership, has not changed since
+	// the last snapshot successfully exported by the replica. In such case, a
+	// *SnapshotUnchangedError carrying the index of the last exported snapshot
+	// is returned and the state machine is not invoked. SkipIfUnchanged
+	// requires Exported.
+	SkipIfUnchanged bool
 }
 
 // Validate checks the SnapshotOption and return error when there is any
 // invalid option found.
 func (o SnapshotOption) Validate() error {
+	if o.ExportSink != nil {
+		if !o.Exported || len(o.ExportPath) > 0 {
+			plog.Errorf("ExportSink set without Exported or with ExportPath")
+			return ErrInvalidOption
+		}
+	}
+	if o.LeaderOnly && !o.Exported {
+		plog.Errorf("LeaderOnly set without Exported")
+		return ErrInvalidOption
+	}
+	if o.SkipIfUnchanged && !o.Exported {
+		plog.Errorf("SkipIfUnchanged set without Exported")
+		return ErrInvalidOption
+	}
 	if o.OverrideCompactionOverhead {
 		if o.CompactionOverhead > 0 && o.CompactionIndex > 0 {
 			plog.Errorf("both CompactionOverhead and CompactionIndex are set")
@@ -272,11 +396,18 @@ type NodeHost struct {
 		shards sync.Map
 		lm     sync.Map
 		logdb  raftio.ILogDB
+		// volatile is the memory backed LogDB used by Volatile replicas
+		volatile *volatileLogDB
+		// readOnly contains the *ReadOnlyReplica instances currently opened
+		readOnly sync.Map
 	}
 	events struct {
+		notifier    *eventNotifier
 		leaderInfoQ *leaderInfoQueue
 		raft        raftio.IRaftEventListener
 		sys         *sysEventListener
+		membershipQ *membershipChangeQueue
+		membership  raftio.IMembershipListener
 	}
 	registry     INodeHostRegistry
 	nodes        raftio.INodeRegistry
@@ -287,8 +418,24 @@ type NodeHost struct {
 	msgHandler   *messageHandler
 	env          *server.Env
 	engine       *engine
+	metrics      *nodeHostMetrics
 	nhConfig     config.NodeHostConfig
 	requestPools []*sync.Pool
+	auditLog     *auditLog
+	diskMonitor  *diskMonitor
+	ssLimiter    *snapshotWriteLimiter
+	memory       *memoryAccountant
+	tenants      *tenantRegistry
+	forwards     snapshotForwards
+	delegations  snapshotDelegations
+	indexSubs    indexSubscriptions
+	clock        config.Clock
+	ticker       *tickScheduler
+	resources    *ResourceGroup
+	ensureLocks  ensureLocks
+	frozen       frozenShards
+	removed      removedReplicas
+	historical   historicalCache
 	partitioned  int32
 	closed       int32
 }
@@ -309,27 +456,52 @@ func NewNodeHost(nhConfig config.NodeHostConfig) (*NodeHost, error) {
 	if err := nhConfig.Prepare(); err != nil {
 		return nil, err
 	}
+	if nhConfig.RunPreflightCheck {
+		report, err := newPreflight(nhConfig).run()
+		if err != nil {
+			return nil, err
+		}
+		plog.Infof("preflight check passed\n%s", report)
+	}
 	env, err := server.NewEnv(nhConfig, nhConfig.Expert.FS)
 	if err != nil {
 		return nil, err
 	}
 	nh := &NodeHost{
-		env:      env,
-		nhConfig: nhConfig,
-		stopper:  syncutil.NewStopper(),
-		fs:       nhConfig.Expert.FS,
+		env:       env,
+		nhConfig:  nhConfig,
+		stopper:   syncutil.NewStopper(),
+		fs:        nhConfig.Expert.FS,
+		auditLog:  newAuditLog(auditLogSize),
+		ssLimiter: newSnapshotWriteLimiter(nhConfig.MaxSnapshotWriteBytesPerSecond),
+		memory:    newMemoryAccountant(nhConfig.MaxMemoryBytes),
+		clock:     nhConfig.Expert.Clock,
+		ticker:    newTickScheduler(),
 	}
 	// make static check happy
 	_ = nh.partitioned
+	// all event queues share a single coalescing notifier, events produced in
+	// the same engine iteration are delivered by a single dispatcher wakeup
+	nh.events.notifier = newEventNotifier(true)
 	nh.events.raft = nhConfig.RaftEventListener
 	nh.events.sys = newSysEventListener(nhConfig.SystemEventListener,
-		nh.stopper.ShouldStop())
+		nhConfig.SystemEventQueueSize)
+	nh.events.sys.notifier = nh.events.notifier
 	nh.mu.cciCh = make(chan struct{}, 1)
 	if nhConfig.RaftEventListener != nil {
 		nh.events.leaderInfoQ = newLeaderInfoQueue()
+		nh.events.leaderInfoQ.notifier = nh.events.notifier
+	}
+	nh.events.membership = nhConfig.MembershipListener
+	if nhConfig.MembershipListener != nil {
+		nh.events.membershipQ = newMembershipChangeQueue()
+		nh.events.membershipQ.notifier = nh.events.notifier
 	}
-	if nhConfig.RaftEventListener != nil || nhConfig.SystemEventListener != nil {
+	if nhConfig.RaftEventListener != nil ||
+		nhConfig.SystemEventListener != nil ||
+		nhConfig.MembershipListener != nil {
 		nh.stopper.RunWorker(func() {
+			newWorkerLabels(nhConfig.EnableProfilerLabels, listenerRole, 0)
 			nh.handleListenerEvents()
 		})
 	}
@@ -354,6 +526,10 @@ func NewNodeHost(nhConfig config.NodeHostConfig) (*NodeHost, error) {
 		return nil, err
 	}
 	plog.Infof("NodeHost ID: %s", nh.id.String())
+	if err := nh.joinResourceGroup(); err != nil {
+		nh.Close()
+		return nil, err
+	}
 	if err := nh.createNodeRegistry(); err != nil {
 		nh.Close()
 		return nil, err
@@ -363,18 +539,47 @@ func NewNodeHost(nhConfig config.NodeHostConfig) (*NodeHost, error) {
 		_, errorInjection = nhConfig.Expert.FS.(*vfs.ErrorFS)
 		plog.Infof("filesystem error injection mode enabled: %t", errorInjection)
 	}
-	nh.engine = newExecEngine(nh, nhConfig.Expert.Engine,
-		nh.nhConfig.NotifyCommit, errorInjection, nh.env, nh.mu.logdb)
+	if err := nh.removeSnapshotTempDirs(); err != nil {
+		nh.Close()
+		return nil, err
+	}
+	nh.metrics = newNodeHostMetrics(nhConfig.EnableMetrics,
+		nhConfig.MaxMetricsShards)
+	nh.metrics.stagingStarted(nh.env.GetStagingSpace())
+	nh.metrics.memoryStarted(nh.memory)
+	nh.tenants = newTenantRegistry(nhConfig.TenantOf,
+		nh.clock.Now, nh.metrics, nh.memory)
+	var cp *closeWorkerPool
+	if nh.resources != nil {
+		cp = nh.resources.cp
+	}
+	nh.engine = newExecEngine(nh, nhConfig.Expert,
+		nh.nhConfig.NotifyCommit, errorInjection, nh.env, nh.mu.logdb,
+		nh.metrics, nhConfig.EnableProfilerLabels, cp)
 	if err := nh.createTransport(); err != nil {
 		nh.Close()
 		return nil, err
 	}
 	nh.stopper.RunWorker(func() {
+		newWorkerLabels(nhConfig.EnableProfilerLabels, nodeMonitorRole, 0)
 		nh.nodeMonitorMain()
 	})
 	nh.stopper.RunWorker(func() {
+		newWorkerLabels(nhConfig.EnableProfilerLabels, tickWorkerRole, 0)
 		nh.tickWorkerMain()
 	})
+	if nhConfig.Expert.RegistryFactory != nil {
+		nh.stopper.RunWorker(func() {
+			nh.registryPublisherMain()
+		})
+	}
+	nh.diskMonitor = newDiskMonitor(nh.nhConfig, nh.fs, nh.events.sys)
+	if nh.diskMonitor.enabled() {
+		nh.stopper.RunWorker(func() {
+			newWorkerLabels(nhConfig.EnableProfilerLabels, diskMonitorRole, 0)
+			nh.diskMonitorMain()
+		})
+	}
 	nh.logNodeHostDetails()
 	return nh, nil
 }
@@ -407,6 +612,7 @@ func (nh *NodeHost) Close() {
 	}
 	plog.Debugf("%s is stopping the nh stopper", nh.describe())
 	nh.stopper.Stop()
+	nh.indexSubs.close()
 	var err error
 	plog.Debugf("%s is stopping the tranport module", nh.describe())
 	if nh.transport != nil {
@@ -422,11 +628,27 @@ func (nh *NodeHost) Close() {
 		nh.engine = nil
 		nh.transport = nil
 	}
+	nh.metrics.stagingClosed()
+	nh.metrics.memoryClosed()
+	nh.metrics.tenantsClosed()
+	nh.metrics.closed()
+	nh.mu.readOnly.Range(func(key, value interface{}) bool {
+		err = firstError(err, value.(*ReadOnlyReplica).Close())
+		return true
+	})
+	nh.historical.close()
 	plog.Debugf("%s is stopping the logdb module", nh.describe())
+	if nh.mu.volatile != nil {
+		err = firstError(err, nh.mu.volatile.Close())
+		nh.mu.volatile = nil
+	}
 	if nh.mu.logdb != nil {
 		err = firstError(err, nh.mu.logdb.Close())
 		nh.mu.logdb = nil
 	}
+	if nh.resources != nil {
+		nh.resources.leave(nh)
+	}
 	plog.Debugf("%s is stopping the env module", nh.describe())
 	err = firstError(err, nh.env.Close())
 	plog.Debugf("NodeHost %s stopped", nh.describe())
@@ -459,7 +681,9 @@ func (nh *NodeHost) ID() string {
 }
 
 // GetNodeHostRegistry returns the NodeHostRegistry instance that can be used
-// to query NodeHost details shared between NodeHost instances by gossip.
+// to query NodeHost details shared between NodeHost instances by gossip. When
+// the static node registry is used, only metadata loaded from the registry
+// file is available.
 func (nh *NodeHost) GetNodeHostRegistry() (INodeHostRegistry, bool) {
 	return nh.registry, nh.nhConfig.DefaultNodeRegistryEnabled
 }
@@ -525,8 +749,11 @@ func (nh *NodeHost) StartOnDiskReplica(initialMembers map[uint64]Target,
 	join bool, create sm.CreateOnDiskStateMachineFunc, cfg config.Config) error {
 	cf := func(shardID uint64, replicaID uint64,
 		done <-chan struct{}) rsm.IManagedStateMachine {
-		sm := create(shardID, replicaID)
-		return rsm.NewNativeSM(cfg, rsm.NewOnDiskStateMachine(sm), done)
+		ds := create(shardID, replicaID)
+		if d, ok := ds.(sm.IDataDir); ok && nh.diskMonitor.enabled() {
+			nh.diskMonitor.setDataDir(shardID, d.DataDir())
+		}
+		return rsm.NewNativeSM(cfg, rsm.NewOnDiskStateMachine(ds), done)
 	}
 	return nh.startShard(initialMembers,
 		join, cf, cfg, pb.OnDiskStateMachine)
@@ -536,23 +763,44 @@ func (nh *NodeHost) StartOnDiskReplica(initialMembers map[uint64]Target,
 // shard.
 //
 // Note that this is not the membership change operation required to remove the
-// node from the Raft shard.
+// node from the Raft shard. Frozen replicas are stopped by being unregistered
+// from the NodeHost, they remain frozen when started again. Replicas removed
+// from their shards are unloaded automatically, they are reported as removed
+// until stopped.
 func (nh *NodeHost) StopShard(shardID uint64) error {
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return ErrClosed
 	}
-	return nh.stopNode(shardID, 0, false)
+	if nh.frozen.stop(shardID, 0, false) {
+		return nil
+	}
+	err := nh.stopNode(shardID, 0, false)
+	if nh.removed.stop(shardID, 0, false) && errors.Is(err, ErrShardNotFound) {
+		return nil
+	}
+	return err
 }
 
 // StopReplica stops the specified Raft replica.
 //
 // Note that this is not the membership change operation required to remove the
-// node from the Raft shard.
+// node from the Raft shard. Frozen replicas are stopped by being unregistered
+// from the NodeHost, they remain frozen when started again. Replicas removed
+// from their shards are unloaded automatically, they are reported as removed
+// until stopped.
 func (nh *NodeHost) StopReplica(shardID uint64, replicaID uint64) error {
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return ErrClosed
 	}
-	return nh.stopNode(shardID, replicaID, true)
+	if nh.frozen.stop(shardID, replicaID, true) {
+		return nil
+	}
+	err := nh.stopNode(shardID, replicaID, true)
+	if nh.removed.stop(shardID, replicaID, true) &&
+		errors.Is(err, ErrShardNotFound) {
+		return nil
+	}
+	return err
 }
 
 // SyncPropose makes a synchronous proposal on the Raft shard specified by
@@ -573,13 +821,23 @@ func (nh *NodeHost) StopReplica(shardID uint64, replicaID uint64) error {
 // the Raft paper recommends to crash the client in this highly unlikely
 // event. When the proposal completed successfully, caller must call
 // client.ProposalCompleted() to get it ready to be used in future proposals.
+//
+// When the Update method set the Error field of the returned result, the
+// result is returned together with a *SMApplicationError carrying the code
+// and message provided by the state machine. Such proposal has been applied,
+// the client session should be updated as a completed proposal.
+//
+// Payloads larger than the MaxEntryChunkBytes of the shard are proposed as
+// chunked proposals, see config.Config.MaxEntryChunkBytes for details. Such
+// proposal fails with ErrAborted when some of its chunks are lost, it can be
+// retried without updating the client session instance.
 func (nh *NodeHost) SyncPropose(ctx context.Context,
 	session *client.Session, cmd []byte) (sm.Result, error) {
 	timeout, err := getTimeoutFromContext(ctx)
 	if err != nil {
 		return sm.Result{}, err
 	}
-	rs, err := nh.Propose(session, cmd, timeout)
+	rs, err := nh.proposeChunked(ctx, session, cmd, timeout)
 	if err != nil {
 		return sm.Result{}, err
 	}
@@ -588,7 +846,31 @@ func (nh *NodeHost) SyncPropose(ctx context.Context,
 		return sm.Result{}, err
 	}
 	rs.Release()
-	return result, nil
+	return result, getApplicationError(session.ShardID, result)
+}
+
+// SyncProposeCommitted is similar to SyncPropose, but it returns the index and
+// term of the proposed entry once the entry is committed by Raft, without
+// waiting for the state machine to apply it. The committed entry is never lost
+// and never rejected, see RequestState.CommittedC() for details.
+//
+// For proposals made with registered client sessions, SyncProposeCommitted only
+// returns once the local replica applied the entry, as the state machine can
+// still reject such entries when applying them. ErrRejected is returned in
+// that case. Once SyncProposeCommitted returns without error,
+// client.ProposalCompleted() can be called in the same way as after a completed
+// SyncPropose, the applied result is not available to the caller.
+func (nh *NodeHost) SyncProposeCommitted(ctx context.Context,
+	session *client.Session, cmd []byte) (EntryMeta, error) {
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return EntryMeta{}, err
+	}
+	rs, err := nh.proposeChunked(ctx, session, cmd, timeout)
+	if err != nil {
+		return EntryMeta{}, err
+	}
+	return getCommittedEntry(ctx, rs)
 }
 
 // SyncRead performs a synchronous linearizable read on the specified Raft
@@ -596,12 +878,13 @@ func (nh *NodeHost) SyncPropose(ctx context.Context,
 // query interface{} specifies what to query, it will be passed to the Lookup
 // method of the IStateMachine or IOnDiskStateMachine after the system
 // determines that it is safe to perform the local read. It returns the query
-// result from the Lookup method or the error encountered.
+// result from the Lookup method or the error encountered. SyncRead can be
+// used on non-voting nodes to offload linearizable reads from regular nodes.
 func (nh *NodeHost) SyncRead(ctx context.Context, shardID uint64,
 	query interface{}) (interface{}, error) {
 	v, err := nh.linearizableRead(ctx, shardID,
 		func(node *node) (interface{}, error) {
-			data, err := node.sm.Lookup(query)
+			data, err := node.lookup(query)
 			if errors.Is(err, rsm.ErrShardClosed) {
 				return nil, ErrShardClosed
 			}
@@ -613,6 +896,35 @@ func (nh *NodeHost) SyncRead(ctx context.Context, shardID uint64,
 	return v, nil
 }
 
+// NASyncRead is a no extra heap allocation variant of SyncRead, it uses byte
+// slice as its input and output data. The query is passed to the LookupBytes
+// method of the state machine when it implements the
+// statemachine.IByteLookup interface, or the NALookup method of the
+// statemachine.IExtended interface otherwise. statemachine.ErrNotImplemented
+// is returned when neither interface is implemented.
+//
+// The specified context parameter must have the timeout value set.
+func (nh *NodeHost) NASyncRead(ctx context.Context, shardID uint64,
+	query []byte) ([]byte, error) {
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rs, node, err := nh.readIndex(ctx, shardID, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := getRequestResult(ctx, rs); err != nil {
+		return nil, err
+	}
+	rs.Release()
+	data, err := node.naLookup(query)
+	if errors.Is(err, rsm.ErrShardClosed) {
+		return nil, ErrShardClosed
+	}
+	return data, err
+}
+
 // GetLogReader returns a read-only LogDB reader.
 func (nh *NodeHost) GetLogReader(shardID uint64) (ReadonlyLogReader, error) {
 	nh.mu.RLock()
@@ -642,8 +954,21 @@ type Membership struct {
 	// witnesses in the Raft shard.
 	Witnesses map[uint64]string
 	// Removed is a set of ReplicaID values that have been removed from the Raft
-	// shard. They are not allowed to be added back to the shard.
+	// shard. They are not allowed to be added back to the shard unless the
+	// AllowReplicaIDReuse field of AddReplicaOption is set.
 	Removed map[uint64]struct{}
+	// PrunedRemoved is the number of removed ReplicaID values pruned from
+	// Removed, see config.Config.MaxRemovedReplicas. ReplicaID values not
+	// larger than PrunedRemovedMax are considered as removed unless they are
+	// members of the Raft shard.
+	PrunedRemoved uint64
+	// PrunedRemovedMax is the largest pruned removed ReplicaID value.
+	PrunedRemovedMax uint64
+	// Outgoing is a map of ReplicaID values to NodeHost Raft addresses for all
+	// regular Raft nodes of the outgoing configuration. It is only populated
+	// when the Raft shard is in a joint configuration, Nodes contains regular
+	// nodes of the incoming configuration in such case.
+	Outgoing map[uint64]string
 }
 
 // SyncGetShardMembership is a synchronous method that queries the membership
@@ -651,28 +976,115 @@ type Membership struct {
 // must have the timeout value set.
 func (nh *NodeHost) SyncGetShardMembership(ctx context.Context,
 	shardID uint64) (*Membership, error) {
+	v, err := nh.linearizableRead(ctx, shardID,
+		func(node *node) (interface{}, error) {
+			return toMembership(node.sm.GetMembership()), nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Membership), nil
+}
+
+// MembershipQueryOption is the option type used when querying memberships of
+// all Raft shards managed by the NodeHost.
+type MembershipQueryOption struct {
+	// LeaderOnly indicates that only Raft shards with the local replica being
+	// the leader are included in the result.
+	LeaderOnly bool
+}
+
+// GetAllMemberships returns the membership of all Raft shards managed by the
+// NodeHost instance based on local replicas' knowledge, the result map is
+// keyed by ShardID values. Unlike SyncGetShardMembership, no ReadIndex
+// protocol is involved, the returned membership can thus be slightly stale
+// when the local replica is behind. Memberships returned for shards led by
+// the local replica contain all applied membership changes committed by that
+// leader, the ConfigChangeID field of each returned Membership can be used to
+// cheaply detect membership changes. Shards with their local replica not
+// fully initialized yet are not included. Nil is returned when the NodeHost
+// instance has been closed.
+func (nh *NodeHost) GetAllMemberships(
+	opt MembershipQueryOption) map[uint64]*Membership {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil
+	}
+	result := make(map[uint64]*Membership)
+	nh.forEachShard(func(shardID uint64, n *node) bool {
+		if !n.initialized() || (opt.LeaderOnly && !n.isLeader()) {
+			return true
+		}
+		result[shardID] = toMembership(n.sm.GetMembership())
+		return true
+	})
+	return result
+}
+
+func toMembership(m pb.Membership) *Membership {
+	removed := make(map[uint64]struct{})
+	for k := range m.Removed {
+		removed[k] = struct{}{}
+	}
+	return &Membership{
+		Nodes:            m.Addresses,
+		NonVotings:       m.NonVotings,
+		Witnesses:        m.Witnesses,
+		Removed:          removed,
+		PrunedRemoved:    m.PrunedRemovedCount,
+		PrunedRemovedMax: m.PrunedRemovedMax,
+		Outgoing:         m.Outgoing,
+		ConfigChangeID:   m.ConfigChangeId,
+	}
+}
+
+// ConfigChangeRecord is the record of an applied membership change.
+type ConfigChangeRecord struct {
+	// Index is the Raft entry index of the membership change entry.
+	Index uint64
+	// Term is the Raft term of the membership change entry.
+	Term uint64
+	// Type is the type of the membership change.
+	Type pb.ConfigChangeType
+	// ReplicaID is the ReplicaID of the target replica. It is 0 for joint
+	// configuration changes.
+	ReplicaID uint64
+	// Address is the NodeHost Raft address of the target replica when
+	// specified by the membership change.
+	Address string
+	// AppliedAt is the time when the membership change was applied by the
+	// replica that recorded it. Replicas recovered from snapshots keep the
+	// time recorded by the replica that created the snapshot, entries applied
+	// again after restart are recorded with the time they are applied again.
+	AppliedAt time.Time
+}
+
+// GetConfigChangeHistory is a synchronous method that queries the history of
+// applied membership changes from the specified Raft shard, oldest first. The
+// number of records kept is limited by the ConfigChangeHistorySize field of
+// config.Config. The specified context parameter must have the timeout value
+// set.
+func (nh *NodeHost) GetConfigChangeHistory(ctx context.Context,
+	shardID uint64) ([]ConfigChangeRecord, error) {
 	v, err := nh.linearizableRead(ctx, shardID,
 		func(node *node) (interface{}, error) {
 			m := node.sm.GetMembership()
-			cm := func(input map[uint64]bool) map[uint64]struct{} {
-				result := make(map[uint64]struct{})
-				for k := range input {
-					result[k] = struct{}{}
-				}
-				return result
+			result := make([]ConfigChangeRecord, 0, len(m.History))
+			for _, r := range m.History {
+				result = append(result, ConfigChangeRecord{
+					Index:     r.Index,
+					Term:      r.Term,
+					Type:      r.Type,
+					ReplicaID: r.ReplicaID,
+					Address:   r.Address,
+					AppliedAt: time.Unix(0, r.Timestamp),
+				})
 			}
-			return &Membership{
-				Nodes:          m.Addresses,
-				NonVotings:     m.NonVotings,
-				Witnesses:      m.Witnesses,
-				Removed:        cm(m.Removed),
-				ConfigChangeID: m.ConfigChangeId,
-			}, nil
+			return result, nil
 		})
 	if err != nil {
 		return nil, err
 	}
-	return v.(*Membership), nil
+	return v.([]ConfigChangeRecord), nil
 }
 
 // GetLeaderID returns the leader replica ID of the specified Raft shard based
@@ -690,6 +1102,90 @@ func (nh *NodeHost) GetLeaderID(shardID uint64) (uint64, uint64, bool, error) {
 	return leaderID, term, valid, nil
 }
 
+// DumpRaftState returns a point-in-time view of the Raft state of the local
+// replica of the specified shard. The returned RaftStateDump is collected by
+// the Raft worker of the replica, it is intended to be attached to bug reports
+// when diagnosing stuck shards. ErrTimeout or ErrCanceled is returned when ctx
+// is done before the Raft worker collects the dump, e.g. when the Raft worker
+// itself is stuck.
+func (nh *NodeHost) DumpRaftState(ctx context.Context,
+	shardID uint64) (*RaftStateDump, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nil, ErrShardNotFound
+	}
+	c, err := n.requestRaftStateDump()
+	if err != nil {
+		return nil, err
+	}
+	nh.engine.setStepReady(shardID)
+	select {
+	case d := <-c:
+		return d, nil
+	case <-n.stopC:
+		return nil, ErrShardClosed
+	case <-ctx.Done():
+		if ctx.Err() == context.Canceled {
+			return nil, ErrCanceled
+		}
+		return nil, ErrTimeout
+	}
+}
+
+// GetSMStats returns the numbers of slow state machine invocations and slow
+// LogDB saves observed by the local replica of the specified shard in the last
+// SlowOpStatsWindow. All counts are 0 when neither
+// NodeHostConfig.SlowSMThreshold nor NodeHostConfig.SlowDiskThreshold is set.
+func (nh *NodeHost) GetSMStats(shardID uint64) (SMStats, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return SMStats{}, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return SMStats{}, ErrShardNotFound
+	}
+	stats := n.slowOps.stats()
+	stats.ShardID = n.shardID
+	stats.ReplicaID = n.replicaID
+	return stats, nil
+}
+
+// GetElectionStats returns the election and heartbeat timing statistics of the
+// local replica of the specified shard. Per peer heartbeat statistics are only
+// available when the local replica is the leader. Statistics are kept in
+// memory and they are reset when the replica is restarted.
+func (nh *NodeHost) GetElectionStats(shardID uint64) (ElectionStats, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ElectionStats{}, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return ElectionStats{}, ErrShardNotFound
+	}
+	return n.getElectionStats(), nil
+}
+
+// SuggestElectionRTT returns the suggested config.Config.ElectionRTT value for
+// the observed p99 heartbeat round-trip time, e.g. the HeartbeatRTTP99 field of
+// ElectionStats, and the config.NodeHostConfig.RTTMillisecond value. The
+// suggested election timeout is 10 times the p99 heartbeat round-trip time and
+// the returned value is never less than 10.
+func SuggestElectionRTT(p99 time.Duration, rttMillisecond uint64) uint64 {
+	const minElectionRTT = 10
+	if rttMillisecond == 0 {
+		return minElectionRTT
+	}
+	rtt := time.Duration(rttMillisecond) * time.Millisecond
+	suggested := uint64((10*p99 + rtt - 1) / rtt)
+	if suggested < minElectionRTT {
+		return minElectionRTT
+	}
+	return suggested
+}
+
 // GetNoOPSession returns a NO-OP client session ready to be used for making
 // proposals. The NO-OP client session is a dummy client session that will not
 // be checked or enforced. Use this No-OP client session when you want to ignore
@@ -717,7 +1213,9 @@ func (nh *NodeHost) GetNoOPSession(shardID uint64) *client.Session {
 // proposal retried after timeout, will not be applied more than once into the
 // state machine.
 //
-// Returned client session instance is not thread safe.
+// Returned client session instance is not thread safe. ErrSessionCapacity is
+// returned when config.Config.SessionTTLEntries is set and the shard already
+// has the maximum number of client sessions active within the TTL.
 //
 // Client session is not supported by IOnDiskStateMachine based user state
 // machines. NO-OP client session must be used on IOnDiskStateMachine based
@@ -804,7 +1302,7 @@ func (nh *NodeHost) QueryRaftLog(shardID uint64, firstIndex uint64,
 // get the client session ready to be used in future proposals.
 func (nh *NodeHost) Propose(session *client.Session, cmd []byte,
 	timeout time.Duration) (*RequestState, error) {
-	return nh.propose(session, cmd, timeout)
+	return nh.propose(context.Background(), session, cmd, timeout)
 }
 
 // ProposeSession starts an asynchronous proposal on the specified shard
@@ -817,7 +1315,7 @@ func (nh *NodeHost) ProposeSession(session *client.Session,
 	timeout time.Duration) (*RequestState, error) {
 	n, ok := nh.getShard(session.ShardID)
 	if !ok {
-		return nil, ErrShardNotFound
+		return nil, nh.shardNotFound(session.ShardID)
 	}
 	// witness node is not expected to propose anything
 	if n.isWitness() {
@@ -837,9 +1335,15 @@ func (nh *NodeHost) ProposeSession(session *client.Session,
 // ReadIndex operation. On a successful completion, the ReadLocalNode method
 // can then be invoked to query the state of the IStateMachine or
 // IOnDiskStateMachine with linearizability guarantee.
+//
+// ReadIndex can be requested on regular nodes and non-voting nodes, it is
+// forwarded to the leader which confirms its leadership before the read
+// index is returned. The ReadIndex operation is completed once the local node
+// applied all entries up to the read index, it is dropped when the shard has
+// no leader and it times out when the local node can not catch up in time.
 func (nh *NodeHost) ReadIndex(shardID uint64,
 	timeout time.Duration) (*RequestState, error) {
-	rs, _, err := nh.readIndex(shardID, timeout)
+	rs, _, err := nh.readIndex(context.Background(), shardID, timeout)
 	return rs, err
 }
 
@@ -856,7 +1360,7 @@ func (nh *NodeHost) ReadLocalNode(rs *RequestState,
 	// internally, the IManagedStateMachine might obtain a RLock before performing
 	// the local read. The critical section is used to make sure we don't read
 	// from a destroyed C++ StateMachine object
-	data, err := rs.node.sm.Lookup(query)
+	data, err := rs.node.lookup(query)
 	if errors.Is(err, rsm.ErrShardClosed) {
 		return nil, ErrShardClosed
 	}
@@ -869,8 +1373,10 @@ func (nh *NodeHost) ReadLocalNode(rs *RequestState,
 // method unless performance is the top priority.
 //
 // As an optional feature of the state machine, NAReadLocalNode returns
-// statemachine.ErrNotImplemented if the underlying state machine does not
-// implement the statemachine.IExtended interface.
+// statemachine.ErrNotImplemented if the underlying state machine implements
+// neither the statemachine.IByteLookup nor the statemachine.IExtended
+// interface. The LookupBytes method is used when the statemachine.IByteLookup
+// interface is implemented.
 //
 // Similar to ReadLocalNode, NAReadLocalNode is only allowed to be called after
 // receiving a RequestCompleted notification from the ReadIndex method.
@@ -880,7 +1386,7 @@ func (nh *NodeHost) NAReadLocalNode(rs *RequestState,
 		return nil, ErrClosed
 	}
 	rs.mustBeReadyForLocalRead()
-	data, err := rs.node.sm.NALookup(query)
+	data, err := rs.node.naLookup(query)
 	if errors.Is(err, rsm.ErrShardClosed) {
 		return nil, ErrShardClosed
 	}
@@ -901,7 +1407,7 @@ func (nh *NodeHost) StaleRead(shardID uint64,
 	}
 	n, ok := nh.getShard(shardID)
 	if !ok {
-		return nil, ErrShardNotFound
+		return nil, nh.shardNotFound(shardID)
 	}
 	if !n.initialized() {
 		return nil, ErrShardNotInitialized
@@ -909,7 +1415,7 @@ func (nh *NodeHost) StaleRead(shardID uint64,
 	if n.isWitness() {
 		return nil, ErrInvalidOperation
 	}
-	data, err := n.sm.Lookup(query)
+	data, err := n.lookup(query)
 	if errors.Is(err, rsm.ErrShardClosed) {
 		return nil, ErrShardClosed
 	}
@@ -924,12 +1430,21 @@ func (nh *NodeHost) StaleRead(shardID uint64,
 // SyncRequestSnapshot returns the index of the created snapshot or the error
 // encountered.
 func (nh *NodeHost) SyncRequestSnapshot(ctx context.Context,
-	shardID uint64, opt SnapshotOption) (uint64, error) {
+	shardID uint64, opt SnapshotOption) (_ uint64, err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation:  "SyncRequestSnapshot",
+		ShardID:    shardID,
+		Parameters: auditParams{"Option": opt},
+	}, time.Now(), &err)
+	if opt.LeaderOnly {
+		result, _, err := nh.exportSnapshot(ctx, shardID, opt)
+		return result.Index, err
+	}
 	timeout, err := getTimeoutFromContext(ctx)
 	if err != nil {
 		return 0, err
 	}
-	rs, err := nh.RequestSnapshot(shardID, opt, timeout)
+	rs, err := nh.requestSnapshot(shardID, opt, timeout)
 	if err != nil {
 		return 0, err
 	}
@@ -961,17 +1476,35 @@ func (nh *NodeHost) SyncRequestSnapshot(ctx context.Context,
 // Requested snapshot operation will be rejected if there is already an existing
 // snapshot in the system at the same Raft log index.
 func (nh *NodeHost) RequestSnapshot(shardID uint64,
+	opt SnapshotOption, timeout time.Duration) (_ *RequestState, err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RequestSnapshot",
+		ShardID:   shardID,
+		Parameters: auditParams{
+			"Option":  opt,
+			"Timeout": timeout,
+		},
+	}, time.Now(), &err)
+	return nh.requestSnapshot(shardID, opt, timeout)
+}
+
+func (nh *NodeHost) requestSnapshot(shardID uint64,
 	opt SnapshotOption, timeout time.Duration) (*RequestState, error) {
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, ErrClosed
 	}
 	n, ok := nh.getShard(shardID)
 	if !ok {
-		return nil, ErrShardNotFound
+		return nil, nh.shardNotFound(shardID)
 	}
 	if err := opt.Validate(); err != nil {
 		return nil, err
 	}
+	if opt.SkipIfUnchanged {
+		if err := n.checkExportUnchanged(); err != nil {
+			return nil, err
+		}
+	}
 	defer nh.engine.setStepReady(shardID)
 	return n.requestSnapshot(opt, nh.getTimeoutTick(timeout))
 }
@@ -991,6 +1524,16 @@ func (nh *NodeHost) RequestSnapshot(shardID uint64,
 // requested compaction is completed. ErrRejected is returned when there is
 // nothing to be reclaimed.
 func (nh *NodeHost) RequestCompaction(shardID uint64,
+	replicaID uint64) (_ *SysOpState, err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RequestCompaction",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+	}, time.Now(), &err)
+	return nh.requestCompaction(shardID, replicaID)
+}
+
+func (nh *NodeHost) requestCompaction(shardID uint64,
 	replicaID uint64) (*SysOpState, error) {
 	nh.mu.Lock()
 	defer nh.mu.Unlock()
@@ -1018,12 +1561,49 @@ func (nh *NodeHost) RequestCompaction(shardID uint64,
 //
 // The input context object must have its deadline set.
 func (nh *NodeHost) SyncRequestDeleteReplica(ctx context.Context,
+	shardID uint64, replicaID uint64, configChangeIndex uint64) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation:  "SyncRequestDeleteReplica",
+		ShardID:    shardID,
+		ReplicaID:  replicaID,
+		Parameters: auditParams{"ConfigChangeIndex": configChangeIndex},
+	}, time.Now(), &err)
+	return nh.syncRequestDeleteReplica(ctx, shardID, replicaID, configChangeIndex)
+}
+
+func (nh *NodeHost) syncRequestDeleteReplica(ctx context.Context,
 	shardID uint64, replicaID uint64, configChangeIndex uint64) error {
 	timeout, err := getTimeoutFromContext(ctx)
 	if err != nil {
 		return err
 	}
-	rs, err := nh.RequestDeleteReplica(shardID, replicaID, configChangeIndex, timeout)
+	rs, err := nh.requestDeleteReplica(shardID, replicaID, configChangeIndex, timeout)
+	if err != nil {
+		return err
+	}
+	_, err = getRequestState(ctx, rs)
+	return err
+}
+
+// SyncRequestForceDeleteReplica is the synchronous variant of the
+// RequestForceDeleteReplica method. See RequestForceDeleteReplica for more
+// details.
+//
+// The input context object must have its deadline set.
+func (nh *NodeHost) SyncRequestForceDeleteReplica(ctx context.Context,
+	shardID uint64, replicaID uint64, configChangeIndex uint64) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation:  "SyncRequestForceDeleteReplica",
+		ShardID:    shardID,
+		ReplicaID:  replicaID,
+		Parameters: auditParams{"ConfigChangeIndex": configChangeIndex},
+	}, time.Now(), &err)
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	rs, err := nh.requestForceDeleteReplica(shardID,
+		replicaID, configChangeIndex, timeout)
 	if err != nil {
 		return err
 	}
@@ -1037,12 +1617,21 @@ func (nh *NodeHost) SyncRequestDeleteReplica(ctx context.Context,
 // The input context object must have its deadline set.
 func (nh *NodeHost) SyncRequestAddReplica(ctx context.Context,
 	shardID uint64, replicaID uint64,
-	target string, configChangeIndex uint64) error {
+	target string, configChangeIndex uint64) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "SyncRequestAddReplica",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+		},
+	}, time.Now(), &err)
 	timeout, err := getTimeoutFromContext(ctx)
 	if err != nil {
 		return err
 	}
-	rs, err := nh.RequestAddReplica(shardID,
+	rs, err := nh.requestAddReplica(shardID,
 		replicaID, target, configChangeIndex, timeout)
 	if err != nil {
 		return err
@@ -1057,12 +1646,50 @@ func (nh *NodeHost) SyncRequestAddReplica(ctx context.Context,
 // The input context object must have its deadline set.
 func (nh *NodeHost) SyncRequestAddNonVoting(ctx context.Context,
 	shardID uint64, replicaID uint64,
-	target string, configChangeIndex uint64) error {
+	target string, configChangeIndex uint64) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "SyncRequestAddNonVoting",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+		},
+	}, time.Now(), &err)
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	rs, err := nh.requestAddNonVoting(shardID,
+		replicaID, target, configChangeIndex, timeout)
+	if err != nil {
+		return err
+	}
+	_, err = getRequestState(ctx, rs)
+	return err
+}
+
+// SyncRequestAddReplicaStaged is the synchronous variant of the
+// RequestAddReplicaStaged method. See RequestAddReplicaStaged for more details.
+//
+// The input context object must have its deadline set.
+func (nh *NodeHost) SyncRequestAddReplicaStaged(ctx context.Context,
+	shardID uint64, replicaID uint64,
+	target string, configChangeIndex uint64) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "SyncRequestAddReplicaStaged",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+		},
+	}, time.Now(), &err)
 	timeout, err := getTimeoutFromContext(ctx)
 	if err != nil {
 		return err
 	}
-	rs, err := nh.RequestAddNonVoting(shardID,
+	rs, err := nh.requestAddReplicaStaged(shardID,
 		replicaID, target, configChangeIndex, timeout)
 	if err != nil {
 		return err
@@ -1071,18 +1698,58 @@ func (nh *NodeHost) SyncRequestAddNonVoting(ctx context.Context,
 	return err
 }
 
+// SyncRequestReplaceReplica is the synchronous variant of the
+// RequestReplaceReplica method. It returns once the shard entered the joint
+// configuration, see RequestReplaceReplica for more details.
+//
+// The input context object must have its deadline set.
+func (nh *NodeHost) SyncRequestReplaceReplica(ctx context.Context,
+	shardID uint64, oldReplicaID uint64, newReplicaID uint64,
+	newTarget string, configChangeIndex uint64) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "SyncRequestReplaceReplica",
+		ShardID:   shardID,
+		ReplicaID: oldReplicaID,
+		Parameters: auditParams{
+			"NewReplicaID":      newReplicaID,
+			"NewTarget":         newTarget,
+			"ConfigChangeIndex": configChangeIndex,
+		},
+	}, time.Now(), &err)
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	rs, err := nh.requestReplaceReplica(shardID, oldReplicaID,
+		newReplicaID, newTarget, configChangeIndex, timeout)
+	if err != nil {
+		return err
+	}
+	_, err = getRequestState(ctx, rs)
+	return err
+}
+
 // SyncRequestAddWitness is the synchronous variant of the RequestAddWitness
 // method. See RequestAddWitness for more details.
 //
 // The input context object must have its deadline set.
 func (nh *NodeHost) SyncRequestAddWitness(ctx context.Context,
 	shardID uint64, replicaID uint64,
-	target string, configChangeIndex uint64) error {
+	target string, configChangeIndex uint64) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "SyncRequestAddWitness",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+		},
+	}, time.Now(), &err)
 	timeout, err := getTimeoutFromContext(ctx)
 	if err != nil {
 		return err
 	}
-	rs, err := nh.RequestAddWitness(shardID,
+	rs, err := nh.requestAddWitness(shardID,
 		replicaID, target, configChangeIndex, timeout)
 	if err != nil {
 		return err
@@ -1091,46 +1758,270 @@ func (nh *NodeHost) SyncRequestAddWitness(ctx context.Context,
 	return err
 }
 
-// RequestDeleteReplica is a Raft shard membership change method for requesting
-// the specified node to be removed from the specified Raft shard. It starts
-// an asynchronous request to remove the node from the Raft shard membership
-// list. Application can wait on the ResultC() channel of the returned
-// RequestState instance to get notified for the outcome.
+// SyncRequestAddReplicaWithOption is the synchronous variant of the
+// RequestAddReplicaWithOption method. See RequestAddReplicaWithOption for
+// more details.
 //
-// It is not guaranteed that deleted node will automatically close itself and
-// be removed from its managing NodeHost instance. It is application's
-// responsibility to call StopShard on the right NodeHost instance to actually
-// have the shard node removed from its managing NodeHost instance.
+// The input context object must have its deadline set.
+func (nh *NodeHost) SyncRequestAddReplicaWithOption(ctx context.Context,
+	shardID uint64, replicaID uint64, target string,
+	configChangeIndex uint64, opt AddReplicaOption) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "SyncRequestAddReplicaWithOption",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+			"Option":            opt,
+		},
+	}, time.Now(), &err)
+	return nh.syncRequestAddWithOption(ctx, pb.AddNode,
+		shardID, replicaID, target, configChangeIndex, opt)
+}
+
+// SyncRequestAddNonVotingWithOption is the synchronous variant of the
+// RequestAddNonVotingWithOption method. See RequestAddNonVotingWithOption for
+// more details.
 //
-// Once a node is successfully deleted from a Raft shard, it will not be
-// allowed to be added back to the shard with the same node identity.
+// The input context object must have its deadline set.
+func (nh *NodeHost) SyncRequestAddNonVotingWithOption(ctx context.Context,
+	shardID uint64, replicaID uint64, target string,
+	configChangeIndex uint64, opt AddReplicaOption) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "SyncRequestAddNonVotingWithOption",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+			"Option":            opt,
+		},
+	}, time.Now(), &err)
+	return nh.syncRequestAddWithOption(ctx, pb.AddNonVoting,
+		shardID, replicaID, target, configChangeIndex, opt)
+}
+
+// SyncRequestAddWitnessWithOption is the synchronous variant of the
+// RequestAddWitnessWithOption method. See RequestAddWitnessWithOption for
+// more details.
 //
-// When the Raft shard is created with the OrderedConfigChange config flag
-// set as false, the configChangeIndex parameter is ignored. Otherwise, it
-// should be set to the most recent Config Change Index value returned by the
-// SyncGetShardMembership method. The requested delete node operation will be
-// rejected if other membership change has been applied since that earlier call
-// to the SyncGetShardMembership method.
-func (nh *NodeHost) RequestDeleteReplica(shardID uint64,
-	replicaID uint64,
-	configChangeIndex uint64, timeout time.Duration) (*RequestState, error) {
-	if atomic.LoadInt32(&nh.closed) != 0 {
-		return nil, ErrClosed
+// The input context object must have its deadline set.
+func (nh *NodeHost) SyncRequestAddWitnessWithOption(ctx context.Context,
+	shardID uint64, replicaID uint64, target string,
+	configChangeIndex uint64, opt AddReplicaOption) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "SyncRequestAddWitnessWithOption",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+			"Option":            opt,
+		},
+	}, time.Now(), &err)
+	return nh.syncRequestAddWithOption(ctx, pb.AddWitness,
+		shardID, replicaID, target, configChangeIndex, opt)
+}
+
+func (nh *NodeHost) syncRequestAddWithOption(ctx context.Context,
+	cct pb.ConfigChangeType, shardID uint64, replicaID uint64, target string,
+	configChangeIndex uint64, opt AddReplicaOption) error {
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return err
 	}
-	n, ok := nh.getShard(shardID)
-	if !ok {
-		return nil, ErrShardNotFound
+	rs, err := nh.requestAddWithOption(cct, shardID,
+		replicaID, target, configChangeIndex, opt, timeout)
+	if err != nil {
+		return err
 	}
-	tt := nh.getTimeoutTick(timeout)
-	defer nh.engine.setStepReady(shardID)
-	return n.requestDeleteNodeWithOrderID(replicaID, configChangeIndex, tt)
+	_, err = getRequestState(ctx, rs)
+	return err
 }
 
-// RequestAddReplica is a Raft shard membership change method for requesting the
-// specified node to be added to the specified Raft shard. It starts an
-// asynchronous request to add the node to the Raft shard membership list.
-// Application can wait on the ResultC() channel of the returned RequestState
-// instance to get notified for the outcome.
+// SyncRequestPromoteWitness is the synchronous variant of the
+// RequestPromoteWitness method. It returns once the promotion has been
+// applied, see RequestPromoteWitness for more details.
+//
+// The input context object must have its deadline set.
+func (nh *NodeHost) SyncRequestPromoteWitness(ctx context.Context,
+	shardID uint64, replicaID uint64, configChangeIndex uint64) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation:  "SyncRequestPromoteWitness",
+		ShardID:    shardID,
+		ReplicaID:  replicaID,
+		Parameters: auditParams{"ConfigChangeIndex": configChangeIndex},
+	}, time.Now(), &err)
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	rs, err := nh.requestPromoteWitness(shardID,
+		replicaID, configChangeIndex, timeout)
+	if err != nil {
+		return err
+	}
+	_, err = getRequestState(ctx, rs)
+	return err
+}
+
+// SyncRequestUpdateReplicaAddress is the synchronous variant of the
+// RequestUpdateReplicaAddress method. See RequestUpdateReplicaAddress for more
+// details.
+//
+// The input context object must have its deadline set.
+func (nh *NodeHost) SyncRequestUpdateReplicaAddress(ctx context.Context,
+	shardID uint64, replicaID uint64,
+	target string, configChangeIndex uint64) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "SyncRequestUpdateReplicaAddress",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+		},
+	}, time.Now(), &err)
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	rs, err := nh.requestUpdateReplicaAddress(shardID,
+		replicaID, target, configChangeIndex, timeout)
+	if err != nil {
+		return err
+	}
+	_, err = getRequestState(ctx, rs)
+	return err
+}
+
+// SyncRequestReconfigure is the synchronous variant of the RequestReconfigure
+// method. See RequestReconfigure for more details.
+//
+// The input context object must have its deadline set.
+func (nh *NodeHost) SyncRequestReconfigure(ctx context.Context,
+	shardID uint64, target Membership, configChangeIndex uint64) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "SyncRequestReconfigure",
+		ShardID:   shardID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+		},
+	}, time.Now(), &err)
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	rs, err := nh.requestReconfigure(shardID,
+		target, configChangeIndex, timeout)
+	if err != nil {
+		return err
+	}
+	_, err = getRequestState(ctx, rs)
+	return err
+}
+
+// RequestDeleteReplica is a Raft shard membership change method for requesting
+// the specified node to be removed from the specified Raft shard. It starts
+// an asynchronous request to remove the node from the Raft shard membership
+// list. Application can wait on the ResultC() channel of the returned
+// RequestState instance to get notified for the outcome.
+//
+// It is not guaranteed that deleted node will automatically close itself and
+// be removed from its managing NodeHost instance. It is application's
+// responsibility to call StopShard on the right NodeHost instance to actually
+// have the shard node removed from its managing NodeHost instance.
+//
+// Once a node is successfully deleted from a Raft shard, it will not be
+// allowed to be added back to the shard with the same node identity.
+//
+// When the Raft shard is created with the OrderedConfigChange config flag
+// set as false, the configChangeIndex parameter is ignored. Otherwise, it
+// should be set to the most recent Config Change Index value returned by the
+// SyncGetShardMembership method. The requested delete node operation will be
+// rejected if other membership change has been applied since that earlier call
+// to the SyncGetShardMembership method.
+//
+// When removing a voting node, the leader rejects the request if the remaining
+// voting nodes would not have a quorum of nodes that responded to the leader
+// within the last ElectionRTT. The request is completed with the Rejected
+// result code in such case and SyncRequestDeleteReplica returns an error that
+// wraps ErrUnsafeMembershipChange and names the inactive nodes. Use the
+// RequestForceDeleteReplica method to skip such check. Removing a regular node
+// is also rejected when the remaining regular nodes would be outnumbered by
+// witnesses, ErrTooManyWitnesses is returned in such case.
+func (nh *NodeHost) RequestDeleteReplica(shardID uint64,
+	replicaID uint64,
+	configChangeIndex uint64, timeout time.Duration) (_ *RequestState, err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RequestDeleteReplica",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"ConfigChangeIndex": configChangeIndex,
+			"Timeout":           timeout,
+		},
+	}, time.Now(), &err)
+	return nh.requestDeleteReplica(shardID, replicaID, configChangeIndex, timeout)
+}
+
+func (nh *NodeHost) requestDeleteReplica(shardID uint64,
+	replicaID uint64,
+	configChangeIndex uint64, timeout time.Duration) (*RequestState, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nil, nh.shardNotFound(shardID)
+	}
+	tt := nh.getTimeoutTick(timeout)
+	defer nh.engine.setStepReady(shardID)
+	return n.requestDeleteNodeWithOrderID(replicaID, configChangeIndex, tt)
+}
+
+// RequestForceDeleteReplica is similar to RequestDeleteReplica, it skips the
+// check on whether the Raft shard would still have a quorum of active voting
+// nodes after the removal. Note that removing a voting node without having a
+// quorum of active voting nodes in the remaining membership can make the Raft
+// shard permanently unavailable.
+func (nh *NodeHost) RequestForceDeleteReplica(shardID uint64,
+	replicaID uint64,
+	configChangeIndex uint64, timeout time.Duration) (_ *RequestState, err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RequestForceDeleteReplica",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"ConfigChangeIndex": configChangeIndex,
+			"Timeout":           timeout,
+		},
+	}, time.Now(), &err)
+	return nh.requestForceDeleteReplica(shardID, replicaID, configChangeIndex, timeout)
+}
+
+func (nh *NodeHost) requestForceDeleteReplica(shardID uint64,
+	replicaID uint64,
+	configChangeIndex uint64, timeout time.Duration) (*RequestState, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nil, nh.shardNotFound(shardID)
+	}
+	tt := nh.getTimeoutTick(timeout)
+	defer nh.engine.setStepReady(shardID)
+	return n.requestForceDeleteNodeWithOrderID(replicaID, configChangeIndex, tt)
+}
+
+// RequestAddReplica is a Raft shard membership change method for requesting the
+// specified node to be added to the specified Raft shard. It starts an
+// asynchronous request to add the node to the Raft shard membership list.
+// Application can wait on the ResultC() channel of the returned RequestState
+// instance to get notified for the outcome.
 //
 // If there is already an nonVoting with the same replicaID in the shard, it will
 // be promoted to a regular node with voting power. The target parameter of the
@@ -1140,7 +2031,13 @@ func (nh *NodeHost) RequestDeleteReplica(shardID uint64,
 // responsibility to call StartReplica on the target NodeHost instance to
 // actually start the Raft shard node.
 //
-// Requesting a removed node back to the Raft shard will always be rejected.
+// Requesting a removed node back to the Raft shard will be rejected,
+// SyncRequestAddReplica returns ErrReplicaIDReused in such case. Use the
+// RequestAddReplicaWithOption method to explicitly allow the ReplicaID of a
+// removed node to be reused. Requesting a node to be added with a target that
+// is used by another node of the shard is rejected and ErrAddressInUse is
+// returned by SyncRequestAddReplica. The same rules apply when adding
+// non-voting members and witnesses.
 //
 // By default, the target parameter is the RaftAddress of the NodeHost instance
 // where the new Raft node will be running. Note that fixed IP or static DNS
@@ -1155,6 +2052,22 @@ func (nh *NodeHost) RequestDeleteReplica(shardID uint64,
 // rejected if other membership change has been applied since that earlier call
 // to the SyncGetShardMembership method.
 func (nh *NodeHost) RequestAddReplica(shardID uint64,
+	replicaID uint64, target Target, configChangeIndex uint64,
+	timeout time.Duration) (_ *RequestState, err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RequestAddReplica",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+			"Timeout":           timeout,
+		},
+	}, time.Now(), &err)
+	return nh.requestAddReplica(shardID, replicaID, target, configChangeIndex, timeout)
+}
+
+func (nh *NodeHost) requestAddReplica(shardID uint64,
 	replicaID uint64, target Target, configChangeIndex uint64,
 	timeout time.Duration) (*RequestState, error) {
 	if atomic.LoadInt32(&nh.closed) != 0 {
@@ -1162,7 +2075,7 @@ func (nh *NodeHost) RequestAddReplica(shardID uint64,
 	}
 	n, ok := nh.getShard(shardID)
 	if !ok {
-		return nil, ErrShardNotFound
+		return nil, nh.shardNotFound(shardID)
 	}
 	defer nh.engine.setStepReady(shardID)
 	return n.requestAddNodeWithOrderID(replicaID,
@@ -1184,9 +2097,29 @@ func (nh *NodeHost) RequestAddReplica(shardID uint64,
 // Application should later call StartReplica with config.Config.IsNonVoting
 // set to true on the right NodeHost to actually start the nonVoting instance.
 //
+// The leader rejects the request when the shard would have more non-voting
+// members than allowed by config.Config.MaxNonVotings, SyncRequestAddNonVoting
+// returns ErrTooManyNonVotings in such case.
+//
 // See the godoc of the RequestAddReplica method for the details of the target and
 // configChangeIndex parameters.
 func (nh *NodeHost) RequestAddNonVoting(shardID uint64,
+	replicaID uint64, target Target, configChangeIndex uint64,
+	timeout time.Duration) (_ *RequestState, err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RequestAddNonVoting",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+			"Timeout":           timeout,
+		},
+	}, time.Now(), &err)
+	return nh.requestAddNonVoting(shardID, replicaID, target, configChangeIndex, timeout)
+}
+
+func (nh *NodeHost) requestAddNonVoting(shardID uint64,
 	replicaID uint64, target Target, configChangeIndex uint64,
 	timeout time.Duration) (*RequestState, error) {
 	if atomic.LoadInt32(&nh.closed) != 0 {
@@ -1194,13 +2127,124 @@ func (nh *NodeHost) RequestAddNonVoting(shardID uint64,
 	}
 	n, ok := nh.getShard(shardID)
 	if !ok {
-		return nil, ErrShardNotFound
+		return nil, nh.shardNotFound(shardID)
 	}
 	defer nh.engine.setStepReady(shardID)
 	return n.requestAddNonVotingWithOrderID(replicaID,
 		target, configChangeIndex, nh.getTimeoutTick(timeout))
 }
 
+// RequestAddReplicaStaged is a Raft shard membership change method for
+// requesting the specified node to be added to the specified Raft shard as a
+// staged non-voting member. It starts an asynchronous request to add the node
+// as a non-voting member, the request is completed once the non-voting member
+// is added.
+//
+// The leader of the shard keeps watching the progress of the staged
+// non-voting member and automatically promotes it to a regular node once its
+// Raft log is close enough to the leader's as defined by the
+// StagedPromotionMaxLag and StagedPromotionMaxLagBytes fields of
+// config.Config. This allows new nodes that require a large snapshot to catch
+// up without impacting the availability of the shard. A
+// StagedPromotionTimeout system event is published by the leader when the
+// staged non-voting member is not promoted within StagedPromotionTimeoutRTT.
+// The watch is restarted when a new leader is elected.
+//
+// Application should later call StartReplica with config.Config.IsNonVoting
+// set to true on the right NodeHost to actually start the node.
+//
+// See the godoc of the RequestAddReplica method for the details of the target
+// and configChangeIndex parameters.
+func (nh *NodeHost) RequestAddReplicaStaged(shardID uint64,
+	replicaID uint64, target Target, configChangeIndex uint64,
+	timeout time.Duration) (_ *RequestState, err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RequestAddReplicaStaged",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+			"Timeout":           timeout,
+		},
+	}, time.Now(), &err)
+	return nh.requestAddReplicaStaged(shardID, replicaID, target, configChangeIndex, timeout)
+}
+
+func (nh *NodeHost) requestAddReplicaStaged(shardID uint64,
+	replicaID uint64, target Target, configChangeIndex uint64,
+	timeout time.Duration) (*RequestState, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nil, nh.shardNotFound(shardID)
+	}
+	defer nh.engine.setStepReady(shardID)
+	return n.requestAddStagedWithOrderID(replicaID,
+		target, configChangeIndex, nh.getTimeoutTick(timeout))
+}
+
+// RequestReplaceReplica is a Raft shard membership change method for
+// requesting the regular node oldReplicaID to be replaced by the new regular
+// node newReplicaID as a single membership change. It starts an asynchronous
+// request to replace the node, the request is completed once the shard enters
+// the joint configuration in which the new node is a member of the shard.
+//
+// The replacement is done using the joint consensus approach described in the
+// godoc of the RequestReconfigure method, the current and the target
+// configurations have the same number of regular nodes. The leader leaves the
+// joint configuration and removes the old node on its own after the request
+// is completed, a newly elected leader completes the change when the leader
+// fails in the middle of it, the shard never ends up with both or neither of
+// the two nodes once the request is completed. ErrInvalidOperation is
+// returned when oldReplicaID is not a regular node of the shard or when
+// newReplicaID is already a regular node as observed by the local replica.
+//
+// Application should later call StartReplica with the join flag set to true on
+// the right NodeHost to start the new node, catching up the new node is not
+// part of the request. Leaving the joint configuration requires a quorum of
+// the target configuration, e.g. it can't be completed before the new node is
+// started when replacing the only regular node of the shard. Other membership
+// change requests are rejected until the joint configuration is left. The
+// request is dropped during a rolling upgrade, see the package documentation.
+//
+// See the godoc of the RequestAddReplica method for the details of the target
+// and configChangeIndex parameters.
+func (nh *NodeHost) RequestReplaceReplica(shardID uint64,
+	oldReplicaID uint64, newReplicaID uint64, newTarget Target,
+	configChangeIndex uint64, timeout time.Duration) (_ *RequestState, err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RequestReplaceReplica",
+		ShardID:   shardID,
+		ReplicaID: oldReplicaID,
+		Parameters: auditParams{
+			"NewReplicaID":      newReplicaID,
+			"NewTarget":         newTarget,
+			"ConfigChangeIndex": configChangeIndex,
+			"Timeout":           timeout,
+		},
+	}, time.Now(), &err)
+	return nh.requestReplaceReplica(shardID, oldReplicaID, newReplicaID,
+		newTarget, configChangeIndex, timeout)
+}
+
+func (nh *NodeHost) requestReplaceReplica(shardID uint64,
+	oldReplicaID uint64, newReplicaID uint64, newTarget Target,
+	configChangeIndex uint64, timeout time.Duration) (*RequestState, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nil, nh.shardNotFound(shardID)
+	}
+	defer nh.engine.setStepReady(shardID)
+	return n.requestReplace(oldReplicaID, newReplicaID, newTarget,
+		configChangeIndex, nh.getTimeoutTick(timeout))
+}
+
 // RequestAddWitness is a Raft shard membership change method for requesting
 // the specified node to be added as a witness to the given Raft shard. It
 // starts an asynchronous request to add the specified node as an witness.
@@ -1214,9 +2258,34 @@ func (nh *NodeHost) RequestAddNonVoting(shardID uint64,
 // Application should later call StartReplica with config.Config.IsWitness
 // set to true on the right NodeHost to actually start the witness node.
 //
+// The leader rejects the request when the shard would have more witnesses than
+// allowed by config.Config.MaxWitnesses or more witnesses than regular nodes,
+// SyncRequestAddWitness returns ErrTooManyWitnesses in such case. Requests
+// for adding a witness collocated with another replica of the shard are
+// logged or rejected with ErrCollocatedWitness depending on
+// config.NodeHostConfig.RejectCollocatedWitness, use the
+// RequestAddWitnessWithOption method with the Force option set to skip the
+// check.
+//
 // See the godoc of the RequestAddReplica method for the details of the target and
 // configChangeIndex parameters.
 func (nh *NodeHost) RequestAddWitness(shardID uint64,
+	replicaID uint64, target Target, configChangeIndex uint64,
+	timeout time.Duration) (_ *RequestState, err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RequestAddWitness",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+			"Timeout":           timeout,
+		},
+	}, time.Now(), &err)
+	return nh.requestAddWitness(shardID, replicaID, target, configChangeIndex, timeout)
+}
+
+func (nh *NodeHost) requestAddWitness(shardID uint64,
 	replicaID uint64, target Target, configChangeIndex uint64,
 	timeout time.Duration) (*RequestState, error) {
 	if atomic.LoadInt32(&nh.closed) != 0 {
@@ -1224,30 +2293,386 @@ func (nh *NodeHost) RequestAddWitness(shardID uint64,
 	}
 	n, ok := nh.getShard(shardID)
 	if !ok {
-		return nil, ErrShardNotFound
+		return nil, nh.shardNotFound(shardID)
+	}
+	if err := nh.checkWitnessPlacement(n,
+		replicaID, target, AddReplicaOption{}); err != nil {
+		return nil, err
 	}
 	defer nh.engine.setStepReady(shardID)
 	return n.requestAddWitnessWithOrderID(replicaID,
 		target, configChangeIndex, nh.getTimeoutTick(timeout))
 }
 
+// AddReplicaOption is the option used when requesting a replica to be added
+// to a Raft shard.
+type AddReplicaOption struct {
+	// AllowReplicaIDReuse allows a removed replica to be added back to the
+	// shard using its old ReplicaID. The new replica is expected to start with
+	// no Raft log or state machine state of the removed replica. Reusing the
+	// ReplicaID of a removed replica that might still be running is unsafe.
+	// Such requests are dropped with ErrShardNotReady during a rolling upgrade
+	// until all members support AllowReplicaIDReuse.
+	AllowReplicaIDReuse bool
+	// Force skips the witness placement check when adding a witness, see
+	// config.NodeHostConfig.RejectCollocatedWitness for details. Targets used
+	// by other replicas of the shard are always rejected with ErrAddressInUse.
+	Force bool
+}
+
+// RequestAddReplicaWithOption is similar to RequestAddReplica, the specified
+// option is used when requesting the node to be added.
+func (nh *NodeHost) RequestAddReplicaWithOption(shardID uint64,
+	replicaID uint64, target Target, configChangeIndex uint64,
+	opt AddReplicaOption, timeout time.Duration) (_ *RequestState, err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RequestAddReplicaWithOption",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+			"Option":            opt,
+			"Timeout":           timeout,
+		},
+	}, time.Now(), &err)
+	return nh.requestAddWithOption(pb.AddNode, shardID,
+		replicaID, target, configChangeIndex, opt, timeout)
+}
+
+// RequestAddNonVotingWithOption is similar to RequestAddNonVoting, the
+// specified option is used when requesting the nonVoting to be added.
+func (nh *NodeHost) RequestAddNonVotingWithOption(shardID uint64,
+	replicaID uint64, target Target, configChangeIndex uint64,
+	opt AddReplicaOption, timeout time.Duration) (_ *RequestState, err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RequestAddNonVotingWithOption",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+			"Option":            opt,
+			"Timeout":           timeout,
+		},
+	}, time.Now(), &err)
+	return nh.requestAddWithOption(pb.AddNonVoting, shardID,
+		replicaID, target, configChangeIndex, opt, timeout)
+}
+
+// RequestAddWitnessWithOption is similar to RequestAddWitness, the specified
+// option is used when requesting the witness to be added.
+func (nh *NodeHost) RequestAddWitnessWithOption(shardID uint64,
+	replicaID uint64, target Target, configChangeIndex uint64,
+	opt AddReplicaOption, timeout time.Duration) (_ *RequestState, err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RequestAddWitnessWithOption",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+			"Option":            opt,
+			"Timeout":           timeout,
+		},
+	}, time.Now(), &err)
+	return nh.requestAddWithOption(pb.AddWitness, shardID,
+		replicaID, target, configChangeIndex, opt, timeout)
+}
+
+func (nh *NodeHost) requestAddWithOption(cct pb.ConfigChangeType,
+	shardID uint64, replicaID uint64, target Target, configChangeIndex uint64,
+	opt AddReplicaOption, timeout time.Duration) (*RequestState, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nil, nh.shardNotFound(shardID)
+	}
+	if cct == pb.AddWitness {
+		if err := nh.checkWitnessPlacement(n, replicaID, target, opt); err != nil {
+			return nil, err
+		}
+	}
+	defer nh.engine.setStepReady(shardID)
+	return n.requestAddWithOption(cct, replicaID, target, configChangeIndex,
+		opt.AllowReplicaIDReuse, nh.getTimeoutTick(timeout))
+}
+
+// RequestPromoteWitness is a Raft shard membership change method for
+// requesting the specified witness to be promoted to a regular node of the
+// given Raft shard. It starts an asynchronous request to promote the witness.
+//
+// The witness has no application state machine and its Raft log only contains
+// metadata entries. Once the promotion is applied, the witness replica stops
+// itself on its NodeHost. Application should then call StartReplica with
+// config.Config.IsWitness set to false and the regular state machine factory
+// on the same NodeHost to restart the replica. Its witness data is dropped on
+// restart and it gets the state machine snapshot from the leader as a newly
+// joined node before applying further entries. Similar to adding a new node,
+// the promoted node can not help to commit entries until it has caught up, all
+// other regular nodes are expected to be available during the promotion. The
+// promoted node doesn't vote or campaign before its log has caught up with the
+// leader, as entries acknowledged by the witness might have been committed
+// with its help. The request is dropped until all members support promotions,
+// see the package documentation for details on rolling upgrades.
+//
+// See the godoc of the RequestAddReplica method for the details of the
+// configChangeIndex parameter.
+func (nh *NodeHost) RequestPromoteWitness(shardID uint64,
+	replicaID uint64, configChangeIndex uint64,
+	timeout time.Duration) (_ *RequestState, err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RequestPromoteWitness",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"ConfigChangeIndex": configChangeIndex,
+			"Timeout":           timeout,
+		},
+	}, time.Now(), &err)
+	return nh.requestPromoteWitness(shardID, replicaID, configChangeIndex, timeout)
+}
+
+func (nh *NodeHost) requestPromoteWitness(shardID uint64,
+	replicaID uint64, configChangeIndex uint64,
+	timeout time.Duration) (*RequestState, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nil, nh.shardNotFound(shardID)
+	}
+	defer nh.engine.setStepReady(shardID)
+	return n.requestPromoteWitnessWithOrderID(replicaID,
+		configChangeIndex, nh.getTimeoutTick(timeout))
+}
+
+// RequestUpdateReplicaAddress is a Raft shard membership change method for
+// requesting the target of the specified member of the given Raft shard to be
+// changed, e.g. when its NodeHost is moved to a new RaftAddress. It starts an
+// asynchronous request to update the target of the replica, the replica keeps
+// its role, its Raft log and its state machine, no snapshot is required.
+//
+// Once the update is applied, all members send messages to the replica at
+// target and connections to its old target are dropped. The old target is
+// retired for the replica, it can't be used by the replica again and messages
+// sent from the old target by the replica are ignored. The update is rejected
+// with ErrAddressInUse when target is used by another member of the shard.
+//
+// To move a replica to a new RaftAddress, stop its NodeHost, update the target
+// using this method on any other NodeHost, change the RaftAddress recorded in
+// its NodeHost directories using tools.ChangeRaftAddress and restart the
+// NodeHost with the new RaftAddress. Other replicas managed by the same
+// NodeHost should have their targets updated in the same way. The replica must
+// not be the only voting member of the shard as the update requires a quorum
+// while the replica is stopped. Other members are required to support address
+// updates, see the package documentation for details on rolling upgrades.
+//
+// See the godoc of the RequestAddReplica method for the details of the target
+// and configChangeIndex parameters.
+func (nh *NodeHost) RequestUpdateReplicaAddress(shardID uint64,
+	replicaID uint64, target Target, configChangeIndex uint64,
+	timeout time.Duration) (_ *RequestState, err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RequestUpdateReplicaAddress",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+			"Timeout":           timeout,
+		},
+	}, time.Now(), &err)
+	return nh.requestUpdateReplicaAddress(shardID,
+		replicaID, target, configChangeIndex, timeout)
+}
+
+func (nh *NodeHost) requestUpdateReplicaAddress(shardID uint64,
+	replicaID uint64, target Target, configChangeIndex uint64,
+	timeout time.Duration) (*RequestState, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nil, nh.shardNotFound(shardID)
+	}
+	defer nh.engine.setStepReady(shardID)
+	return n.requestUpdateAddressWithOrderID(replicaID,
+		target, configChangeIndex, nh.getTimeoutTick(timeout))
+}
+
+// RequestReconfigure is a Raft shard membership change method for requesting
+// the regular nodes of the specified Raft shard to be replaced by the Nodes of
+// the target membership in a single membership change. It starts an
+// asynchronous request to reconfigure the shard using the joint consensus
+// approach described in section 4.3 of Diego Ongaro's thesis.
+//
+// The shard first enters a joint configuration in which both the current and
+// the target sets of regular nodes are required to form quorums for elections
+// and for committing entries, the leader then automatically transitions the
+// shard to the target configuration. The request is completed once the target
+// configuration is applied. Nodes in the current configuration but not in the
+// target configuration are removed from the shard, non-voting members
+// included in the target Nodes are promoted to regular nodes. NonVotings,
+// Witnesses, Removed and ConfigChangeID fields of the target membership are
+// ignored, witnesses are not allowed to be included in the target Nodes.
+//
+// When any current regular node is removed, the request is rejected by the
+// leader as unsafe if the target regular nodes would not have a quorum of
+// nodes that responded to the leader within the last ElectionRTT, see
+// RequestDeleteReplica for more details.
+//
+// Other membership change requests are rejected when the shard is in the joint
+// configuration. Application should later call StartReplica with the join flag
+// set to true on the right NodeHost instances to start the newly added nodes.
+// The request is dropped until all members in the target configuration
+// support joint consensus, see the package documentation for details on
+// rolling upgrades.
+//
+// See the godoc of the RequestAddReplica method for the details of the target
+// and configChangeIndex parameters.
+func (nh *NodeHost) RequestReconfigure(shardID uint64,
+	target Membership, configChangeIndex uint64,
+	timeout time.Duration) (_ *RequestState, err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RequestReconfigure",
+		ShardID:   shardID,
+		Parameters: auditParams{
+			"Target":            target,
+			"ConfigChangeIndex": configChangeIndex,
+			"Timeout":           timeout,
+		},
+	}, time.Now(), &err)
+	return nh.requestReconfigure(shardID, target, configChangeIndex, timeout)
+}
+
+func (nh *NodeHost) requestReconfigure(shardID uint64,
+	target Membership, configChangeIndex uint64,
+	timeout time.Duration) (*RequestState, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nil, nh.shardNotFound(shardID)
+	}
+	defer nh.engine.setStepReady(shardID)
+	return n.requestReconfigure(target.Nodes,
+		configChangeIndex, nh.getTimeoutTick(timeout))
+}
+
+// LeaderTransferOption is the option type used when requesting leadership
+// transfers.
+type LeaderTransferOption struct {
+	// NoCatchupWait indicates that the leader transfer request should be
+	// rejected with ErrTargetLagging when the target has not caught up with the
+	// leader, the leader waits for the target to catch up otherwise. Such check
+	// is only performed when the request is made on the NodeHost of the leader.
+	NoCatchupWait bool
+}
+
 // RequestLeaderTransfer makes a request to transfer the leadership of the
 // specified Raft shard to the target node identified by targetReplicaID. It
 // returns an error if the request fails to be started. There is no guarantee
 // that such request can be fulfilled.
+//
+// The target is checked against the membership known to the local replica,
+// ErrTargetIsNonVoting, ErrTargetIsWitness or ErrTargetNotMember is returned
+// when the target is a non-voting member, a witness or not a member of the
+// shard, e.g. a removed replica.
 func (nh *NodeHost) RequestLeaderTransfer(shardID uint64,
-	targetReplicaID uint64) error {
+	targetReplicaID uint64) (err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation:  "RequestLeaderTransfer",
+		ShardID:    shardID,
+		Parameters: auditParams{"TargetReplicaID": targetReplicaID},
+	}, time.Now(), &err)
+	return nh.requestLeaderTransferWithOption(shardID,
+		targetReplicaID, LeaderTransferOption{})
+}
+
+// RequestLeaderTransferWithOption is similar to RequestLeaderTransfer, the
+// input LeaderTransferOption instance is used to specify how the leader
+// transfer request is handled. See LeaderTransferOption for details.
+func (nh *NodeHost) RequestLeaderTransferWithOption(shardID uint64,
+	targetReplicaID uint64, opt LeaderTransferOption) (err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RequestLeaderTransferWithOption",
+		ShardID:   shardID,
+		Parameters: auditParams{
+			"TargetReplicaID": targetReplicaID,
+			"Option":          opt,
+		},
+	}, time.Now(), &err)
+	return nh.requestLeaderTransferWithOption(shardID, targetReplicaID, opt)
+}
+
+func (nh *NodeHost) requestLeaderTransferWithOption(shardID uint64,
+	targetReplicaID uint64, opt LeaderTransferOption) error {
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return ErrClosed
 	}
 	n, ok := nh.getShard(shardID)
 	if !ok {
-		return ErrShardNotFound
+		return nh.shardNotFound(shardID)
 	}
 	plog.Debugf("RequestLeaderTransfer called on shard %d target replicaID %d",
 		shardID, targetReplicaID)
 	defer nh.engine.setStepReady(shardID)
-	return n.requestLeaderTransfer(targetReplicaID)
+	return n.requestLeaderTransfer(targetReplicaID, opt)
+}
+
+// SyncRequestLeaderTransfer is the synchronous variant of the
+// RequestLeaderTransferWithOption method, it waits until the target becomes
+// the leader as observed by the local replica. The target is checked in the
+// same way as RequestLeaderTransferWithOption. As there is no guarantee that
+// a leader transfer request can be fulfilled, the request is repeated once
+// every election timeout. The input context object must have its deadline
+// set, ErrTimeout is returned when the target failed to become the leader
+// before the deadline.
+func (nh *NodeHost) SyncRequestLeaderTransfer(ctx context.Context,
+	shardID uint64, targetReplicaID uint64, opt LeaderTransferOption) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "SyncRequestLeaderTransfer",
+		ShardID:   shardID,
+		Parameters: auditParams{
+			"TargetReplicaID": targetReplicaID,
+			"Option":          opt,
+		},
+	}, time.Now(), &err)
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		return ErrDeadlineNotSet
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nh.shardNotFound(shardID)
+	}
+	for tick := uint64(0); ; tick++ {
+		leaderID, _, ok, err := nh.GetLeaderID(shardID)
+		if err != nil {
+			return err
+		}
+		if ok && leaderID == targetReplicaID {
+			return nil
+		}
+		if tick%n.config.ElectionRTT == 0 {
+			err := nh.requestLeaderTransferWithOption(shardID,
+				targetReplicaID, opt)
+			if err != nil && !errors.Is(err, ErrSystemBusy) {
+				return err
+			}
+		}
+		if err := nh.waitRTT(ctx); err != nil {
+			return err
+		}
+	}
 }
 
 // SyncRemoveData is the synchronous variant of the RemoveData. It waits for
@@ -1257,6 +2682,16 @@ func (nh *NodeHost) RequestLeaderTransfer(shardID uint64,
 // Similar to RemoveData, calling SyncRemoveData on a node that is still a Raft
 // shard member will corrupt the Raft shard.
 func (nh *NodeHost) SyncRemoveData(ctx context.Context,
+	shardID uint64, replicaID uint64) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "SyncRemoveData",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+	}, time.Now(), &err)
+	return nh.syncRemoveData(ctx, shardID, replicaID)
+}
+
+func (nh *NodeHost) syncRemoveData(ctx context.Context,
 	shardID uint64, replicaID uint64) error {
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return ErrClosed
@@ -1278,7 +2713,7 @@ func (nh *NodeHost) SyncRemoveData(ctx context.Context,
 			}
 		}
 	}
-	err := nh.RemoveData(shardID, replicaID)
+	err := nh.removeData(shardID, replicaID)
 	if errors.Is(err, ErrShardNotStopped) {
 		panic("node not stopped")
 	}
@@ -1292,7 +2727,16 @@ func (nh *NodeHost) SyncRemoveData(ctx context.Context,
 //
 // RemoveData returns ErrShardNotStopped when the specified node has not been
 // fully offloaded from the NodeHost instance.
-func (nh *NodeHost) RemoveData(shardID uint64, replicaID uint64) error {
+func (nh *NodeHost) RemoveData(shardID uint64, replicaID uint64) (err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "RemoveData",
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+	}, time.Now(), &err)
+	return nh.removeData(shardID, replicaID)
+}
+
+func (nh *NodeHost) removeData(shardID uint64, replicaID uint64) error {
 	n, ok := nh.getShard(shardID)
 	if ok && n.replicaID == replicaID {
 		return ErrShardNotStopped
@@ -1305,18 +2749,177 @@ func (nh *NodeHost) RemoveData(shardID uint64, replicaID uint64) error {
 	if nh.engine.nodeLoaded(shardID, replicaID) {
 		return ErrShardNotStopped
 	}
+	if _, ok := nh.mu.readOnly.Load(shardID); ok {
+		return ErrReadOnlyReplicaOpen
+	}
 	plog.Debugf("%s called RemoveData", dn(shardID, replicaID))
 	if err := nh.mu.logdb.RemoveNodeData(shardID, replicaID); err != nil {
 		panicNow(err)
 	}
+	if nh.mu.volatile != nil {
+		if err := nh.mu.volatile.RemoveNodeData(shardID, replicaID); err != nil {
+			panicNow(err)
+		}
+	}
 	// mark the snapshot dir as removed
 	did := nh.nhConfig.GetDeploymentID()
 	if err := nh.env.RemoveSnapshotDir(did, shardID, replicaID); err != nil {
 		panicNow(err)
 	}
+	nh.removed.stop(shardID, replicaID, true)
+	return nil
+}
+
+// DecommissionOption is the option type used when decommissioning the local
+// replica of a Raft shard.
+type DecommissionOption struct {
+	// RemoveData indicates whether all data of the local replica should be
+	// removed once the replica has been removed from the shard and stopped.
+	RemoveData bool
+}
+
+// SyncDecommissionLocalReplica removes the local replica of the specified Raft
+// shard from the shard, waits for the removal to be observed by the local
+// replica, stops the local replica and optionally removes all its data. When
+// the local replica is the leader, the leadership is transferred to another
+// regular replica before the removal is requested. The removal is proposed
+// via the leader of the shard, there is no need to make the request from the
+// leader's NodeHost. The input context object must have its deadline set.
+//
+// SyncDecommissionLocalReplica can be re-invoked to complete the remaining
+// steps when a previous invocation failed or when the process crashed midway.
+// The local replica must be restarted using StartReplica after a crash, it
+// stops once it replayed its own removal. It is not possible to decommission
+// the only regular replica of a shard, ErrInvalidOperation is returned in
+// such case. ErrShardNotFound is returned when the local replica of the
+// specified shard is not found, e.g. after a previous invocation completed.
+func (nh *NodeHost) SyncDecommissionLocalReplica(ctx context.Context,
+	shardID uint64, opt DecommissionOption) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation:  "SyncDecommissionLocalReplica",
+		ShardID:    shardID,
+		Parameters: auditParams{"Option": opt},
+	}, time.Now(), &err)
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		return ErrDeadlineNotSet
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return ErrShardNotFound
+	}
+	if !n.initialized() {
+		return ErrShardNotReady
+	}
+	if err := nh.removeLocalReplica(ctx, n); err != nil {
+		return err
+	}
+	err = nh.StopReplica(shardID, n.replicaID)
+	if err != nil && !errors.Is(err, ErrShardNotFound) {
+		return err
+	}
+	if !opt.RemoveData {
+		return nil
+	}
+	return nh.syncRemoveData(ctx, shardID, n.replicaID)
+}
+
+// removeLocalReplica requests the specified local replica to be removed from
+// its shard and waits for the removal to be applied by the local replica.
+func (nh *NodeHost) removeLocalReplica(ctx context.Context, n *node) error {
+	removed := func() bool {
+		return n.sm.GetMembership().IsRemoved(n.replicaID) && n.stopped()
+	}
+	if removed() {
+		return nil
+	}
+	if n.stopped() {
+		// e.g. a witness stopped after being promoted
+		return ErrShardClosed
+	}
+	if err := nh.transferLeadershipAway(ctx, n); err != nil {
+		return err
+	}
+	for !removed() {
+		err := nh.syncRequestDeleteReplica(ctx, n.shardID, n.replicaID, 0)
+		if err == nil || errors.Is(err, ErrShardClosed) {
+			break
+		}
+		// the removal is dropped when there is no leader or the leader is busy
+		// on another config change
+		if !errors.Is(err, ErrShardNotReady) && !errors.Is(err, ErrSystemBusy) {
+			return err
+		}
+		if err := nh.waitRTT(ctx); err != nil {
+			return err
+		}
+	}
+	for !removed() {
+		if err := nh.waitRTT(ctx); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// transferLeadershipAway transfers the leadership of the shard to another
+// regular replica when the specified local replica is the leader.
+func (nh *NodeHost) transferLeadershipAway(ctx context.Context, n *node) error {
+	target := getLeaderTransferTarget(n.sm.GetMembership(), n.replicaID)
+	for tick := uint64(0); ; tick++ {
+		if leader, _ := n.raftEvents.isLeader(); !leader {
+			return nil
+		}
+		if target == pb.NoNode {
+			return ErrInvalidOperation
+		}
+		// the transfer is not guaranteed to be fulfilled, it is retried once
+		// every election timeout
+		if tick%n.config.ElectionRTT == 0 {
+			err := nh.requestLeaderTransferWithOption(n.shardID,
+				target, LeaderTransferOption{})
+			if err != nil && !errors.Is(err, ErrSystemBusy) {
+				return err
+			}
+		}
+		if err := nh.waitRTT(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// getLeaderTransferTarget returns the regular replica with the smallest
+// ReplicaID other than the excluded one, pb.NoNode is returned when there is
+// no such replica.
+func getLeaderTransferTarget(m pb.Membership, excluded uint64) uint64 {
+	target := pb.NoNode
+	for replicaID := range m.Addresses {
+		if replicaID == excluded {
+			continue
+		}
+		if target == pb.NoNode || replicaID < target {
+			target = replicaID
+		}
+	}
+	return target
+}
+
+// waitRTT waits for one RTT or until the context is done.
+func (nh *NodeHost) waitRTT(ctx context.Context) error {
+	td := time.Duration(nh.nhConfig.RTTMillisecond) * time.Millisecond
+	select {
+	case <-nh.clock.After(td):
+		return nil
+	case <-ctx.Done():
+		if ctx.Err() == context.Canceled {
+			return ErrCanceled
+		}
+		return ErrTimeout
+	}
+}
+
 // GetNodeUser returns an INodeUser instance ready to be used to directly make
 // proposals or read index operations without locating the node repeatedly in
 // the NodeHost. A possible use case is when loading a large data set say with
@@ -1327,7 +2930,7 @@ func (nh *NodeHost) GetNodeUser(shardID uint64) (INodeUser, error) {
 	}
 	n, ok := nh.getShard(shardID)
 	if !ok {
-		return nil, ErrShardNotFound
+		return nil, nh.shardNotFound(shardID)
 	}
 	return &nodeUser{
 		nh:           nh,
@@ -1362,6 +2965,19 @@ func (nh *NodeHost) GetNodeHostInfo(opt NodeHostInfoOption) *NodeHostInfo {
 		RaftAddress:   nh.RaftAddress(),
 		Gossip:        nh.getGossipInfo(),
 		ShardInfoList: nh.getShardInfo(),
+		ReadOnlyMode:  nh.nhConfig.ReadOnlyMode,
+	}
+	nhi.SnapshotStaging = nh.getSnapshotStagingInfo()
+	if opt.WithRaftState {
+		// dumps are collected by step workers, nh.mu is not held when waiting
+		ctx, cancel := context.WithTimeout(context.Background(),
+			raftStateDumpTimeout)
+		defer cancel()
+		for _, ci := range nhi.ShardInfoList {
+			if d, err := nh.DumpRaftState(ctx, ci.ShardID); err == nil {
+				nhi.RaftStateList = append(nhi.RaftStateList, *d)
+			}
+		}
 	}
 	nh.mu.Lock()
 	defer nh.mu.Unlock()
@@ -1375,7 +2991,135 @@ func (nh *NodeHost) GetNodeHostInfo(opt NodeHostInfoOption) *NodeHostInfo {
 		}
 		nhi.LogInfo = logInfo
 	}
-	return nhi
+	return nhi
+}
+
+// GetTransportStats returns the transport statistics of all remote NodeHost
+// instances this NodeHost instance has exchanged messages with. Nil is
+// returned when the NodeHost instance has been closed.
+func (nh *NodeHost) GetTransportStats() []PeerTransportStats {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil
+	}
+	return nh.transport.GetPeerStats()
+}
+
+// UpdateGossipTags replaces the tags of the NodeHost initially specified by
+// NodeHostConfig.Gossip.Tags. The update is propagated to other NodeHost
+// instances by gossip, usually within a few gossip intervals.
+//
+// ErrInvalidOperation is returned when the gossip service is not used.
+func (nh *NodeHost) UpdateGossipTags(tags map[string]string) error {
+	r, err := nh.getGossipRegistry()
+	if err != nil {
+		return err
+	}
+	gc := nh.nhConfig.Gossip
+	gc.Tags = tags
+	if err := gc.Validate(); err != nil {
+		return err
+	}
+	return r.UpdateTags(tags)
+}
+
+// SetDrainState sets whether the NodeHost is advertised as draining, e.g.
+// before it is taken down for maintenance. The NodeHost keeps running and
+// stays in the gossip group, the drain state is published to other NodeHost
+// instances as a part of its gossip metadata and can be queried using the
+// IsNodeHostDraining method of INodeHostRegistry. Applications are expected
+// to stop placing new replicas on draining NodeHost instances, the leader
+// balancer in the tools/balancer package moves leaderships away from them.
+//
+// The drain state is not persisted, it is reset once the NodeHost is
+// restarted. ErrInvalidOperation is returned when the gossip service is not
+// used.
+func (nh *NodeHost) SetDrainState(draining bool) error {
+	r, err := nh.getGossipRegistry()
+	if err != nil {
+		return err
+	}
+	return r.SetDraining(draining)
+}
+
+// AddGossipKey adds the specified key to the keyring used by the gossip
+// service. The added key is accepted for decrypting incoming gossip messages
+// but not used for encrypting outgoing messages until UseGossipKey is called.
+// The key must be 16, 24 or 32 bytes long.
+//
+// Gossip keys are rotated in three phases, each phase should be completed on
+// all NodeHost instances before starting the next one: AddGossipKey to
+// install the new key, UseGossipKey to make it the primary key and then
+// RemoveGossipKey to remove the old key. Fingerprints of installed keys are
+// available in the GossipInfo returned by the GetNodeHostInfo method. Keys
+// changed at runtime are not persisted, NodeHostConfig.Gossip.Keys should be
+// updated accordingly before restarting the NodeHost.
+//
+// ErrInvalidOperation is returned when the gossip service is not used or
+// gossip messages are not encrypted.
+func (nh *NodeHost) AddGossipKey(key []byte) error {
+	r, err := nh.getGossipRegistry()
+	if err != nil {
+		return err
+	}
+	return toGossipKeyError(r.AddKey(key))
+}
+
+// UseGossipKey makes the specified key the primary key used for encrypting
+// outgoing gossip messages, the key must have been added by AddGossipKey or
+// listed in NodeHostConfig.Gossip.Keys. See AddGossipKey for details.
+func (nh *NodeHost) UseGossipKey(key []byte) error {
+	r, err := nh.getGossipRegistry()
+	if err != nil {
+		return err
+	}
+	return toGossipKeyError(r.UseKey(key))
+}
+
+// RemoveGossipKey removes the specified key from the keyring used by the
+// gossip service, the primary key can not be removed. See AddGossipKey for
+// details.
+func (nh *NodeHost) RemoveGossipKey(key []byte) error {
+	r, err := nh.getGossipRegistry()
+	if err != nil {
+		return err
+	}
+	return toGossipKeyError(r.RemoveKey(key))
+}
+
+func (nh *NodeHost) getGossipRegistry() (*registry.GossipRegistry, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	r, ok := nh.nodes.(*registry.GossipRegistry)
+	if !ok {
+		return nil, ErrInvalidOperation
+	}
+	return r, nil
+}
+
+func toGossipKeyError(err error) error {
+	if errors.Is(err, registry.ErrEncryptionDisabled) {
+		return ErrInvalidOperation
+	}
+	return err
+}
+
+// ReloadRegistry reloads the NodeHostID to RaftAddress mappings from the file
+// specified by NodeHostConfig.StaticRegistry.File. Previously loaded mappings
+// are atomically replaced, they are kept unchanged when the file can not be
+// loaded. Connections to NodeHost instances with updated RaftAddress values
+// use the new addresses once they are re-established.
+//
+// ErrInvalidOperation is returned when the static node registry is not used.
+func (nh *NodeHost) ReloadRegistry() error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	r, ok := nh.nodes.(*registry.StaticRegistry)
+	if !ok {
+		return ErrInvalidOperation
+	}
+	return r.Reload()
 }
 
 func (nh *NodeHost) getGossipInfo() GossipInfo {
@@ -1384,38 +3128,40 @@ func (nh *NodeHost) getGossipInfo() GossipInfo {
 			Enabled:             true,
 			AdvertiseAddress:    r.AdvertiseAddress(),
 			NumOfKnownNodeHosts: r.NumMembers(),
+			KeyFingerprints:     r.KeyFingerprints(),
+			Draining:            r.Draining(),
 		}
 	}
 	return GossipInfo{}
 }
 
-func (nh *NodeHost) propose(s *client.Session,
+func (nh *NodeHost) propose(ctx context.Context, s *client.Session,
 	cmd []byte, timeout time.Duration) (*RequestState, error) {
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, ErrClosed
 	}
 	v, ok := nh.getShard(s.ShardID)
 	if !ok {
-		return nil, ErrShardNotFound
+		return nil, nh.shardNotFound(s.ShardID)
 	}
 	if !v.supportClientSession() && !s.IsNoOPSession() {
 		panic("IOnDiskStateMachine based nodes must use NoOPSession")
 	}
-	req, err := v.propose(s, cmd, nh.getTimeoutTick(timeout))
+	req, err := v.propose(ctx, s, cmd, nh.getTimeoutTick(timeout))
 	nh.engine.setStepReady(s.ShardID)
 	return req, err
 }
 
-func (nh *NodeHost) readIndex(shardID uint64,
+func (nh *NodeHost) readIndex(ctx context.Context, shardID uint64,
 	timeout time.Duration) (*RequestState, *node, error) {
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, nil, ErrClosed
 	}
 	n, ok := nh.getShard(shardID)
 	if !ok {
-		return nil, nil, ErrShardNotFound
+		return nil, nil, nh.shardNotFound(shardID)
 	}
-	req, err := n.read(nh.getTimeoutTick(timeout))
+	req, err := n.read(ctx, nh.getTimeoutTick(timeout))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1430,7 +3176,7 @@ func (nh *NodeHost) queryRaftLog(shardID uint64,
 	}
 	v, ok := nh.getShard(shardID)
 	if !ok {
-		return nil, ErrShardNotFound
+		return nil, nh.shardNotFound(shardID)
 	}
 	if lastIndex <= firstIndex {
 		return nil, ErrInvalidRange
@@ -1446,7 +3192,7 @@ func (nh *NodeHost) linearizableRead(ctx context.Context,
 	if err != nil {
 		return nil, err
 	}
-	rs, node, err := nh.readIndex(shardID, timeout)
+	rs, node, err := nh.readIndex(ctx, shardID, timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -1457,6 +3203,87 @@ func (nh *NodeHost) linearizableRead(ctx context.Context,
 	return f(node)
 }
 
+// NonVotingProgress is the replication progress of a non-voting member known
+// to the leader.
+type NonVotingProgress struct {
+	// Match is the index of the last Raft log entry known to be replicated to
+	// the non-voting member.
+	Match uint64
+	// Lag is the number of Raft log entries the non-voting member is behind the
+	// last index of the leader.
+	Lag uint64
+}
+
+// GetNonVotingProgress returns the replication progress of all non-voting
+// members of the specified Raft shard keyed by their ReplicaID values. It is
+// only available when the local replica is the leader of the shard,
+// ErrInvalidOperation is returned otherwise.
+func (nh *NodeHost) GetNonVotingProgress(
+	shardID uint64) (map[uint64]NonVotingProgress, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nil, ErrShardNotFound
+	}
+	if !n.initialized() {
+		return nil, ErrShardNotInitialized
+	}
+	progress, ok := n.getNonVotingProgress()
+	if !ok {
+		return nil, ErrInvalidOperation
+	}
+	return progress, nil
+}
+
+// GetLocalLag returns the number of Raft log entries known to be committed by
+// the local replica of the specified Raft shard but not applied yet. The
+// committed index is learned from messages sent by the leader, the returned
+// value is thus an estimate of how far the local replica, e.g. a non-voting
+// member, is behind the shard. Entries not yet replicated to the local
+// replica are not counted.
+func (nh *NodeHost) GetLocalLag(shardID uint64) (uint64, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return 0, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return 0, ErrShardNotFound
+	}
+	if !n.initialized() {
+		return 0, ErrShardNotInitialized
+	}
+	return n.getLocalLag(), nil
+}
+
+// IsLeader returns a boolean value indicating whether the local replica of the
+// specified Raft shard is the leader and the term of its leadership. It is a
+// cheap call intended to be used on hot paths, no lock is involved and no
+// memory is allocated.
+//
+// The returned value is updated by the local replica when the raft leadership
+// change is observed, the same source used for reporting LeaderUpdated events
+// to the raftio.IRaftEventListener. Pull users of IsLeader and push users of
+// LeaderUpdated thus observe the same sequence of leadership changes. The
+// local replica stops being reported as the leader as soon as it steps down,
+// before it stops acting as the leader. This is best-effort, a leader
+// partitioned from the rest of the shard keeps being reported as the leader
+// until it notices that it lost the quorum when CheckQuorum is enabled.
+//
+// False is returned when the specified shard is not found or the NodeHost has
+// been closed.
+func (nh *NodeHost) IsLeader(shardID uint64) (bool, uint64) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return false, 0
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return false, 0
+	}
+	return n.raftEvents.isLeader()
+}
+
 func (nh *NodeHost) getShard(shardID uint64) (*node, bool) {
 	n, ok := nh.mu.shards.Load(shardID)
 	if !ok {
@@ -1505,31 +3332,144 @@ func (nh *NodeHost) bootstrapShard(initialMembers map[uint64]Target,
 		if !join {
 			members = initialMembers
 		}
+		if cfg.Standby && !join {
+			plog.Errorf("%s standby replica must join the shard",
+				dn(cfg.ShardID, cfg.ReplicaID))
+			return nil, false, ErrInvalidShardSettings
+		}
 		bi = pb.NewBootstrapInfo(join, smType, initialMembers)
+		bi.Standby = cfg.Standby
+		bi.WriteFsyncMode = uint32(cfg.WriteFsyncMode)
+		bi.Volatile = cfg.StorageClass == config.Volatile
+		if err := nh.checkLocalBootstrapInfo(cfg, bi); err != nil {
+			return nil, false, err
+		}
 		err := nh.mu.logdb.SaveBootstrapInfo(cfg.ShardID, cfg.ReplicaID, bi)
 		if err != nil {
 			return nil, false, err
 		}
+		if bi.Volatile {
+			nh.mu.volatile.addReplica(cfg.ShardID, cfg.ReplicaID)
+		}
 		return members, !join, nil
 	} else if err != nil {
 		return nil, false, err
 	}
+	if bi.WriteFsyncMode != uint32(cfg.WriteFsyncMode) {
+		plog.Errorf("%s bootstrapped with write fsync mode %d, got %d",
+			dn(cfg.ShardID, cfg.ReplicaID), bi.WriteFsyncMode, cfg.WriteFsyncMode)
+		return nil, false, ErrInvalidShardSettings
+	}
+	if bi.Volatile != (cfg.StorageClass == config.Volatile) {
+		plog.Errorf("%s bootstrapped with volatile %t, got storage class %d",
+			dn(cfg.ShardID, cfg.ReplicaID), bi.Volatile, cfg.StorageClass)
+		return nil, false, ErrInvalidShardSettings
+	}
+	if bi.Promoted {
+		// the promoted witness is restarted as a regular node, its local witness
+		// data is dropped by the node before it joins the shard again
+		if cfg.IsWitness || len(initialMembers) > 0 {
+			plog.Errorf("%s is a promoted witness, witness %t, members %v",
+				dn(cfg.ShardID, cfg.ReplicaID), cfg.IsWitness, initialMembers)
+			return nil, false, ErrInvalidShardSettings
+		}
+		did := nh.nhConfig.GetDeploymentID()
+		err := nh.env.RemoveSavedSnapshots(did, cfg.ShardID, cfg.ReplicaID)
+		if err != nil {
+			return nil, false, err
+		}
+		return nil, false, nil
+	}
 	if !bi.Validate(initialMembers, join, smType) {
 		plog.Errorf("bootstrap info validation failed, %s, %v, %t, %v, %t",
 			dn(cfg.ShardID, cfg.ReplicaID),
 			bi.Addresses, bi.Join, initialMembers, join)
 		return nil, false, ErrInvalidShardSettings
 	}
+	if bi.Volatile && !nh.mu.volatile.hasLog(cfg.ShardID, cfg.ReplicaID) {
+		// the Raft log was lost when the NodeHost was closed, the replica rejoins
+		// the shard with its replica ID to get the snapshot or log from the leader
+		plog.Infof("%s lost its volatile Raft log, rejoining the shard",
+			dn(cfg.ShardID, cfg.ReplicaID))
+		did := nh.nhConfig.GetDeploymentID()
+		err := nh.env.RemoveSavedSnapshots(did, cfg.ShardID, cfg.ReplicaID)
+		if err != nil {
+			return nil, false, err
+		}
+		nh.mu.volatile.addReplica(cfg.ShardID, cfg.ReplicaID)
+		return nil, false, nil
+	}
 	return bi.Addresses, !bi.Join, nil
 }
 
+// checkLocalBootstrapInfo checks whether other replicas of the same shard
+// previously bootstrapped on the NodeHost have the same initial members and
+// write fsync mode.
+func (nh *NodeHost) checkLocalBootstrapInfo(cfg config.Config,
+	bi pb.Bootstrap) error {
+	hash := bi.MembersHash()
+	if hash == 0 {
+		return nil
+	}
+	ni, err := nh.mu.logdb.ListNodeInfo()
+	if err != nil {
+		return err
+	}
+	for _, v := range ni {
+		if v.ShardID != cfg.ShardID || v.ReplicaID == cfg.ReplicaID {
+			continue
+		}
+		recorded, err := nh.mu.logdb.GetBootstrapInfo(v.ShardID, v.ReplicaID)
+		if errors.Is(err, raftio.ErrNoBootstrapInfo) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if rh := recorded.MembersHash(); rh != 0 && rh != hash {
+			plog.Errorf("%s initial members %v, mode %d, %s bootstrapped with %v, mode %d",
+				dn(cfg.ShardID, cfg.ReplicaID), bi.Addresses, bi.WriteFsyncMode,
+				dn(v.ShardID, v.ReplicaID), recorded.Addresses, recorded.WriteFsyncMode)
+			return ErrInvalidShardSettings
+		}
+	}
+	return nil
+}
+
 func (nh *NodeHost) startShard(initialMembers map[uint64]Target,
 	join bool, createStateMachine rsm.ManagedStateMachineFactory,
 	cfg config.Config, smType pb.StateMachineType) error {
 	shardID := cfg.ShardID
 	replicaID := cfg.ReplicaID
+	if cfg.LazyReplay && smType == pb.OnDiskStateMachine {
+		return ErrInvalidShardSettings
+	}
+	if cfg.StorageClass == config.Volatile {
+		// the state machine must be recovered from other replicas along with the
+		// Raft log, which requires other replicas to be available
+		if smType == pb.OnDiskStateMachine ||
+			(!join && len(initialMembers) == 1) {
+			plog.Errorf("%s volatile storage class not supported, members %v",
+				dn(shardID, replicaID), initialMembers)
+			return ErrInvalidShardSettings
+		}
+	}
+	if nh.nhConfig.ReadOnlyMode && !cfg.IsNonVoting && !cfg.IsObserver {
+		return errors.Wrapf(ErrReadOnlyNodeHost,
+			"%s is not non-voting", dn(shardID, replicaID))
+	}
+	if err := cfg.SetTimingTicks(nh.nhConfig.RTTMillisecond); err != nil {
+		plog.Errorf("%s invalid timings, %v", dn(shardID, replicaID), err)
+		return ErrInvalidShardSettings
+	}
+	if uint64(len(initialMembers)) > settings.MaxMembers {
+		return ErrMembershipTooLarge
+	}
 	validator := nh.nhConfig.GetTargetValidator()
 	for _, target := range initialMembers {
+		if uint64(len(target)) > settings.MaxAddressLength {
+			return ErrMembershipTooLarge
+		}
 		if !validator(target) {
 			return ErrInvalidTarget
 		}
@@ -1549,9 +3489,21 @@ func (nh *NodeHost) startShard(initialMembers map[uint64]Target,
 			// node is still loaded in the execution engine, e.g. processing snapshot
 			return nil, ErrShardAlreadyExist
 		}
+		if _, ok := nh.mu.readOnly.Load(shardID); ok {
+			return nil, ErrReadOnlyReplicaOpen
+		}
 		if join && len(initialMembers) > 0 {
 			return nil, ErrInvalidShardSettings
 		}
+		nh.removed.stop(shardID, 0, false)
+		ldb := nh.mu.logdb
+		if cfg.StorageClass == config.Volatile {
+			vdb, err := nh.getVolatileLogDB()
+			if err != nil {
+				return nil, err
+			}
+			ldb = vdb
+		}
 		peers, im, err := nh.bootstrapShard(initialMembers, join, cfg, smType)
 		if errors.Is(err, ErrInvalidShardSettings) {
 			return nil, err
@@ -1564,6 +3516,34 @@ func (nh *NodeHost) startShard(initialMembers map[uint64]Target,
 				nh.nodes.Add(shardID, k, v)
 			}
 		}
+		bi, err := nh.mu.logdb.GetBootstrapInfo(shardID, replicaID)
+		if err != nil {
+			panicNow(err)
+		}
+		if bi.Frozen {
+			// frozen replicas are not started until thawed
+			ss, err := ldb.GetSnapshot(shardID, replicaID)
+			if err != nil {
+				panicNow(err)
+			}
+			if err := nh.frozen.add(&frozenReplica{
+				cfg:      cfg,
+				createSM: createStateMachine,
+				smType:   smType,
+				info:     getFrozenShardInfo(cfg, smType, ss.Membership),
+			}); err != nil {
+				return nil, err
+			}
+			plog.Infof("%s is frozen", dn(shardID, replicaID))
+			return nil, nil
+		}
+		factory := createStateMachine
+		var standby *standbyState
+		if bi.Standby {
+			// the state machine is not created until the standby is activated
+			standby = &standbyState{createSM: createStateMachine, smType: smType}
+			createStateMachine = getStandbyStateMachineFactory(cfg)
+		}
 		did := nh.nhConfig.GetDeploymentID()
 		if err := nh.env.CreateSnapshotDir(did, shardID, replicaID); err != nil {
 			if errors.Is(err, server.ErrDirMarkedAsDeleted) {
@@ -1574,13 +3554,30 @@ func (nh *NodeHost) startShard(initialMembers map[uint64]Target,
 		getSnapshotDir := func(cid uint64, nid uint64) string {
 			return nh.env.GetSnapshotDir(did, cid, nid)
 		}
-		logReader := logdb.NewLogReader(shardID, replicaID, nh.mu.logdb)
+		logReader := logdb.NewLogReader(shardID, replicaID, ldb)
 		ss := newSnapshotter(shardID, replicaID,
-			getSnapshotDir, nh.mu.logdb, logReader, nh.fs)
+			getSnapshotDir, ldb, logReader, nh.fs, cfg.SnapshotsToKeep)
 		logReader.SetCompactor(ss)
+		tenant := nh.tenants.getShardTenant(shardID)
+		ss.limiter = nh.ssLimiter
+		ss.tenant = tenant.snapshotLimiter()
+		ss.staging = nh.env.GetStagingSpace()
 		if err := ss.processOrphans(); err != nil {
 			panicNow(err)
 		}
+		// Volatile replicas have no Raft log in the durable LogDB to audit
+		if nh.nhConfig.AuditOnStart && cfg.StorageClass != config.Volatile {
+			if err := nh.auditReplica(cfg,
+				standby != nil, createStateMachine, smType); err != nil {
+				return nil, err
+			}
+		}
+		if nh.nhConfig.ReadOnlyMode && im {
+			// the replica was bootstrapped as an initial voting member, it is
+			// restarted as such with campaigns disabled
+			cfg.IsNonVoting = false
+			cfg.IsObserver = false
+		}
 		p := server.NewDoubleFixedPartitioner(nh.nhConfig.Expert.Engine.ExecShards,
 			nh.nhConfig.Expert.LogDB.Shards)
 		shard := p.GetPartitionID(shardID)
@@ -1593,17 +3590,28 @@ func (nh *NodeHost) startShard(initialMembers map[uint64]Target,
 			logReader,
 			nh.engine,
 			nh.events.leaderInfoQ,
+			nh.events.membershipQ,
 			nh.transport.GetStreamSink,
 			nh.msgHandler.HandleSnapshotStatus,
 			nh.sendMessage,
 			nh.nodes,
 			nh.requestPools[replicaID%requestPoolShards],
-			nh.mu.logdb,
+			ldb,
 			nh.getLogDBMetrics(shard),
 			nh.events.sys)
 		if err != nil {
 			panicNow(err)
 		}
+		rn.clock = nh.clock.Now
+		rn.removeConnections = nh.transport.RemoveConnections
+		rn.ticker = nh.ticker
+		rn.memory = nh.memory
+		rn.tenant = tenant
+		rn.standby = standby
+		rn.createSM = factory
+		rn.pendingReadIndexes.rounds = &nh.engine.stats.reads
+		rn.setMetrics(nh.metrics.newShardMetrics(rn))
+		rn.setDiskFull(nh.diskMonitor.hostDiskFull())
 		rn.loaded()
 		nh.mu.shards.Store(shardID, rn)
 		nh.mu.cci++
@@ -1615,7 +3623,7 @@ func (nh *NodeHost) startShard(initialMembers map[uint64]Target,
 	}
 
 	rn, err := doStart()
-	if err != nil {
+	if err != nil || rn == nil {
 		return err
 	}
 
@@ -1691,6 +3699,13 @@ func (nh *NodeHost) createLogDB() error {
 	if err := nh.env.CheckNodeHostDir(nh.nhConfig, ver, name); err != nil {
 		return err
 	}
+	if err := nh.env.CheckFormatManifest(server.FormatManifest{
+		LogDBType:       name,
+		LogDBBinVersion: ver,
+		SnapshotVersion: uint64(rsm.DefaultVersion),
+	}); err != nil {
+		return err
+	}
 	if shardedrdb, ok := ldb.(*logdb.ShardedDB); ok {
 		failed, err := shardedrdb.SelfCheckFailed()
 		if err != nil {
@@ -1722,6 +3737,42 @@ func (nh *NodeHost) getLogDBMetrics(shard uint64) *logDBMetrics {
 	return lm
 }
 
+type gossipEvent struct {
+	nh *NodeHost
+}
+
+func (ge *gossipEvent) GossipIsolated(addr string) {
+	ge.nh.events.sys.Publish(server.SystemEvent{
+		Type:    server.GossipIsolated,
+		Address: addr,
+		Members: 1,
+	})
+}
+
+func (ge *gossipEvent) GossipRejoined(addr string, members int) {
+	ge.nh.events.sys.Publish(server.SystemEvent{
+		Type:    server.GossipRejoined,
+		Address: addr,
+		Members: uint64(members),
+	})
+}
+
+func (ge *gossipEvent) NodeHostSuspected(nhid string, raftAddress string) {
+	ge.nh.events.sys.Publish(server.SystemEvent{
+		Type:       server.NodeHostSuspected,
+		NodeHostID: nhid,
+		Address:    raftAddress,
+	})
+}
+
+func (ge *gossipEvent) NodeHostRecovered(nhid string, raftAddress string) {
+	ge.nh.events.sys.Publish(server.SystemEvent{
+		Type:       server.NodeHostRecovered,
+		NodeHostID: nhid,
+		Address:    raftAddress,
+	})
+}
+
 type transportEvent struct {
 	nh *NodeHost
 }
@@ -1742,6 +3793,75 @@ func (te *transportEvent) ConnectionFailed(addr string, snapshot bool) {
 	})
 }
 
+func (te *transportEvent) ConnectionRejected(addr string) {
+	te.nh.events.sys.Publish(server.SystemEvent{
+		Type:    server.ConnectionRejected,
+		Address: addr,
+	})
+}
+
+func (te *transportEvent) MisdeliveredMessage(addr string,
+	shardID uint64, replicaID uint64) {
+	te.nh.events.sys.Publish(server.SystemEvent{
+		Type:      server.MisdeliveredMessage,
+		Address:   addr,
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+	})
+}
+
+func (te *transportEvent) SnapshotReceiveStarted(info raftio.SnapshotInfo) {
+	if n, ok := te.getNode(info.ShardID, info.ReplicaID); ok {
+		n.setSnapshotReceiveInfo(0, 0)
+	}
+	te.nh.events.sys.Publish(server.SystemEvent{
+		Type:      server.SnapshotReceiveStarted,
+		ShardID:   info.ShardID,
+		ReplicaID: info.ReplicaID,
+		From:      info.From,
+		Index:     info.Index,
+	})
+}
+
+func (te *transportEvent) SnapshotReceiveProgress(
+	info raftio.SnapshotProgressInfo) {
+	if n, ok := te.getNode(info.ShardID, info.ReplicaID); ok {
+		n.setSnapshotReceiveInfo(info.ReceivedBytes, info.TotalBytes)
+	}
+	te.nh.events.sys.Publish(server.SystemEvent{
+		Type:          server.SnapshotReceiveProgress,
+		ShardID:       info.ShardID,
+		ReplicaID:     info.ReplicaID,
+		From:          info.From,
+		Index:         info.Index,
+		ReceivedBytes: info.ReceivedBytes,
+		TotalBytes:    info.TotalBytes,
+	})
+}
+
+func (te *transportEvent) SnapshotReceiveAborted(info raftio.SnapshotAbortInfo) {
+	if n, ok := te.getNode(info.ShardID, info.ReplicaID); ok {
+		n.clearSnapshotReceiveInfo()
+	}
+	te.nh.events.sys.Publish(server.SystemEvent{
+		Type:      server.SnapshotReceiveAborted,
+		ShardID:   info.ShardID,
+		ReplicaID: info.ReplicaID,
+		From:      info.From,
+		Index:     info.Index,
+		Reason:    info.Reason,
+	})
+}
+
+func (te *transportEvent) getNode(shardID uint64,
+	replicaID uint64) (*node, bool) {
+	n, ok := te.nh.getShard(shardID)
+	if !ok || n.replicaID != replicaID {
+		return nil, false
+	}
+	return n, true
+}
+
 func (nh *NodeHost) createNodeRegistry() error {
 	validator := nh.nhConfig.GetTargetValidator()
 	// TODO:
@@ -1752,9 +3872,31 @@ func (nh *NodeHost) createNodeRegistry() error {
 		if nh.nhConfig.Expert.NodeRegistryFactory != nil {
 			return errors.New("DefaultNodeRegistryEnabled and Expert.NodeRegistryFactory should not both be set")
 		}
+		if !nh.nhConfig.StaticRegistry.IsEmpty() {
+			plog.Infof("DefaultNodeRegistryEnabled: true, use static node registry")
+			r, err := registry.NewStaticRegistry(nh.ID(),
+				nh.nhConfig, streamConnections, validator)
+			if err != nil {
+				return err
+			}
+			nh.registry = r
+			nh.nodes = r
+			return nil
+		}
+		if f := nh.nhConfig.Expert.RegistryFactory; f != nil {
+			plog.Infof("DefaultNodeRegistryEnabled: true, use custom registry")
+			r, err := f.Create(nh.nhConfig, nh.ID())
+			if err != nil {
+				return err
+			}
+			dr := registry.NewDiscoveryRegistry(r, streamConnections, validator)
+			nh.registry = dr
+			nh.nodes = dr
+			return nil
+		}
 		plog.Infof("DefaultNodeRegistryEnabled: true, use gossip based node registry")
 		r, err := registry.NewGossipRegistry(nh.ID(), nh.getShardInfo,
-			nh.nhConfig, streamConnections, validator)
+			nh.nhConfig, streamConnections, validator, &gossipEvent{nh: nh})
 		if err != nil {
 			return err
 		}
@@ -1774,11 +3916,36 @@ func (nh *NodeHost) createNodeRegistry() error {
 	return nil
 }
 
+// joinResourceGroup adds the NodeHost to the resource group specified in
+// Expert.Resources.
+func (nh *NodeHost) joinResourceGroup() error {
+	r := nh.nhConfig.Expert.Resources
+	if r == nil {
+		return nil
+	}
+	rg, ok := r.(*ResourceGroup)
+	if !ok {
+		plog.Errorf("unknown resources type %T", r)
+		return ErrResourceGroupMismatch
+	}
+	if err := rg.join(nh); err != nil {
+		return err
+	}
+	nh.resources = rg
+	return nil
+}
+
 func (nh *NodeHost) createTransport() error {
 	getSnapshotDir := func(cid uint64, nid uint64) string {
 		return nh.env.GetSnapshotDir(nh.nhConfig.GetDeploymentID(), cid, nid)
 	}
-	tsp, err := transport.NewTransport(nh.nhConfig,
+	nhConfig := nh.nhConfig
+	if nh.resources != nil {
+		if f := nh.resources.getTransportFactory(nh); f != nil {
+			nhConfig.Expert.TransportFactory = f
+		}
+	}
+	tsp, err := transport.NewTransport(nhConfig,
 		nh.msgHandler, nh.env, nh.nodes, getSnapshotDir,
 		&transportEvent{nh: nh}, nh.fs)
 	if err != nil {
@@ -1818,31 +3985,54 @@ func (nh *NodeHost) getShardInfo() []ShardInfo {
 		shardInfoList = append(shardInfoList, node.getShardInfo())
 		return true
 	})
-	return shardInfoList
+	for _, info := range nh.removed.getShardInfo() {
+		// the removed replica is still being unloaded
+		if _, ok := nh.getShard(info.ShardID); !ok {
+			shardInfoList = append(shardInfoList, info)
+		}
+	}
+	return append(shardInfoList, nh.frozen.getShardInfo()...)
 }
 
 func (nh *NodeHost) tickWorkerMain() {
-	tick := uint64(0)
 	idx := uint64(0)
 	nodes := make([]*node, 0)
 	tf := func() {
-		tick++
 		if idx != nh.getShardSetIndex() {
 			nodes = nodes[:0]
 			idx = nh.forEachShard(func(cid uint64, n *node) bool {
 				nodes = append(nodes, n)
 				return true
 			})
+			nh.ticker.update(nodes)
 		}
-		nh.sendTickMessage(nodes, tick)
-		nh.engine.setAllStepReady(nodes)
+		tick, ticked := nh.ticker.next()
+		nh.memory.refresh(nodes, nh.transport.GetSnapshotStagingBytes())
+		nh.sendTickMessage(ticked, tick)
+		nh.expireDelegations()
+		nh.indexSubs.update(nodes, nh.clock.Now())
+		nh.engine.setAllStepReady(ticked)
+		// coalesced events are delivered within one tick
+		nh.flushEvents()
+		nh.env.GetTimerWheel().Tick()
 	}
 	td := time.Duration(nh.nhConfig.RTTMillisecond) * time.Millisecond
-	ticker := time.NewTicker(td)
-	defer ticker.Stop()
+	var tickC <-chan struct{}
+	var timeC <-chan time.Time
+	if nh.resources != nil {
+		c, timer := nh.resources.subscribeTick(td)
+		defer timer.Stop()
+		tickC = c
+	} else {
+		ticker := nh.clock.NewTicker(td)
+		defer ticker.Stop()
+		timeC = ticker.C()
+	}
 	for {
 		select {
-		case <-ticker.C:
+		case <-tickC:
+			tf()
+		case <-timeC:
 			tf()
 		case <-nh.stopper.ShouldStop():
 			return
@@ -1850,29 +4040,89 @@ func (nh *NodeHost) tickWorkerMain() {
 	}
 }
 
-func (nh *NodeHost) handleListenerEvents() {
-	var ch chan struct{}
-	if nh.events.leaderInfoQ != nil {
-		ch = nh.events.leaderInfoQ.workReady()
+// registryPublisherMain periodically publishes views of local shards to the
+// registry created by the Expert.RegistryFactory.
+func (nh *NodeHost) registryPublisherMain() {
+	r, ok := nh.nodes.(*registry.DiscoveryRegistry)
+	if !ok {
+		panic("unexpected registry type")
 	}
+	ticker := nh.clock.NewTicker(nh.nhConfig.Expert.RegistryPublishInterval)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-ticker.C():
+			if err := r.Publish(nh.getShardInfo()); err != nil {
+				plog.Warningf("failed to publish to the registry, %v", err)
+			}
 		case <-nh.stopper.ShouldStop():
 			return
-		case <-ch:
-			for {
+		}
+	}
+}
+
+func (nh *NodeHost) handleListenerEvents() {
+	stopC := nh.stopper.ShouldStop()
+	stopped := func() bool {
+		select {
+		case <-stopC:
+			return true
+		default:
+			return false
+		}
+	}
+	sys := nh.events.sys
+	for {
+		select {
+		case <-stopC:
+			return
+		case <-nh.events.notifier.workReady():
+			// queued events are delivered in order for each queue, a single
+			// wakeup handles pending events of all shards
+			for nh.events.leaderInfoQ != nil && !stopped() {
 				v, ok := nh.events.leaderInfoQ.getLeaderInfo()
 				if !ok {
 					break
 				}
-				nh.events.raft.LeaderUpdated(v)
+				sys.invoke("IRaftEventListener", v.ShardID, v.ReplicaID, func() {
+					nh.events.raft.LeaderUpdated(v)
+				})
+			}
+			for nh.events.membershipQ != nil && !stopped() {
+				v, ok := nh.events.membershipQ.getMembershipChange()
+				if !ok {
+					break
+				}
+				sys.invoke("IMembershipListener", v.ShardID, v.ReplicaID, func() {
+					nh.events.membership.MembershipChanged(v)
+				})
+			}
+			for !stopped() {
+				e, ok := sys.getEvent()
+				if !ok {
+					break
+				}
+				sys.handle(e)
 			}
-		case e := <-nh.events.sys.events:
-			nh.events.sys.handle(e)
 		}
 	}
 }
 
+// flushEvents wakes up the event dispatcher when there are coalesced events
+// pending for delivery.
+func (nh *NodeHost) flushEvents() {
+	if nh == nil {
+		return
+	}
+	nh.events.notifier.flush()
+}
+
+// GetEventQueueStats returns the statistics of the queue used for delivering
+// system events to the config.NodeHostConfig.SystemEventListener.
+func (nh *NodeHost) GetEventQueueStats() raftio.IEventQueueStats {
+	return nh.events.sys
+}
+
 func (nh *NodeHost) sendMessage(msg pb.Message) {
 	if nh.isPartitioned() {
 		return
@@ -1884,12 +4134,10 @@ func (nh *NodeHost) sendMessage(msg pb.Message) {
 		plog.Debugf("%s is sending snapshot to %s, witness %t, index %d, size %d",
 			dn(msg.ShardID, msg.From), dn(msg.ShardID, msg.To),
 			witness, msg.Snapshot.Index, msg.Snapshot.FileSize)
-		if n, ok := nh.getShard(msg.ShardID); ok {
-			if witness || !n.OnDiskStateMachine() {
-				nh.transport.SendSnapshot(msg)
-			} else {
-				n.pushStreamSnapshotRequest(msg.ShardID, msg.To)
-			}
+		n, ok := nh.getShard(msg.ShardID)
+		if ok && !witness && n.isWitnessReplica(msg.To) {
+			plog.Panicf("%s is sending snapshot %d to witness %s",
+				n.id(), msg.Snapshot.Index, dn(msg.ShardID, msg.To))
 		}
 		nh.events.sys.Publish(server.SystemEvent{
 			Type:      server.SendSnapshotStarted,
@@ -1897,9 +4145,28 @@ func (nh *NodeHost) sendMessage(msg pb.Message) {
 			ReplicaID: msg.To,
 			From:      msg.From,
 		})
+		if ok {
+			if witness {
+				nh.sendWitnessSnapshot(msg)
+			} else if !n.OnDiskStateMachine() {
+				if !nh.delegateSnapshot(n, msg) {
+					nh.transport.SendSnapshot(msg)
+				}
+			} else {
+				n.pushStreamSnapshotRequest(msg.ShardID, msg.To)
+			}
+		}
 	}
 }
 
+// sendWitnessSnapshot sends the snapshot to the witness as a regular message.
+// Witness snapshots only contain metadata as witnesses have no state machine,
+// there is thus no snapshot data to be streamed.
+func (nh *NodeHost) sendWitnessSnapshot(msg pb.Message) {
+	sent := nh.transport.Send(msg)
+	nh.msgHandler.HandleSnapshotStatus(msg.ShardID, msg.To, !sent)
+}
+
 func (nh *NodeHost) sendTickMessage(shards []*node, tick uint64) {
 	for _, n := range shards {
 		m := pb.Message{
@@ -1939,8 +4206,16 @@ func (nh *NodeHost) nodeMonitorMain() {
 		if !ok && index < len(nodes) {
 			// node closed
 			n := nodes[index]
+			// removed replicas are reported as such until stopped by the user
+			removed := n.removed()
+			if removed {
+				nh.removed.add(n.getShardInfo())
+			}
 			if err := nh.stopNode(n.shardID, n.replicaID, true); err != nil {
 				plog.Debugf("stopNode failed %v", err)
+				if removed {
+					nh.removed.stop(n.shardID, n.replicaID, true)
+				}
 			}
 		} else if index == len(nodes) {
 			// cci change
@@ -1969,32 +4244,57 @@ func (nh *NodeHost) logNodeHostDetails() {
 }
 
 func getRequestState(ctx context.Context, rs *RequestState) (sm.Result, error) {
+	r, err := getRequestResult(ctx, rs)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	return r.GetResult(), nil
+}
+
+func getRequestResult(ctx context.Context,
+	rs *RequestState) (RequestResult, error) {
 	select {
 	case r := <-rs.AppliedC():
-		if r.Completed() {
-			return r.GetResult(), nil
-		} else if r.Rejected() {
-			return sm.Result{}, ErrRejected
-		} else if r.Timeout() {
-			return sm.Result{}, ErrTimeout
-		} else if r.Terminated() {
-			return sm.Result{}, ErrShardClosed
-		} else if r.Dropped() {
-			return sm.Result{}, ErrShardNotReady
-		} else if r.Aborted() {
-			return sm.Result{}, ErrAborted
-		}
-		plog.Panicf("unknown v code %v", r)
+		if err := getRequestError(r); err != nil {
+			return RequestResult{}, err
+		}
+		return r, nil
 	case <-ctx.Done():
+		// the result delivered from now on is counted as a late completion
+		rs.abandoned.set()
 		if ctx.Err() == context.Canceled {
-			return sm.Result{}, ErrCanceled
+			return RequestResult{}, ErrCanceled
 		} else if ctx.Err() == context.DeadlineExceeded {
-			return sm.Result{}, ErrTimeout
+			return RequestResult{}, ErrTimeout
 		}
 	}
 	panic("should never reach here")
 }
 
+// getCommittedEntry waits for the committed notification of the proposal, the
+// RequestState is released when the proposal is completed.
+func getCommittedEntry(ctx context.Context,
+	rs *RequestState) (EntryMeta, error) {
+	select {
+	case m := <-rs.CommittedC():
+		return m, nil
+	case r := <-rs.AppliedC():
+		if err := getRequestError(r); err != nil {
+			return EntryMeta{}, err
+		}
+		// the committed notification is delivered before the completion
+		m := <-rs.CommittedC()
+		rs.Release()
+		return m, nil
+	case <-ctx.Done():
+		rs.abandoned.set()
+		if ctx.Err() == context.Canceled {
+			return EntryMeta{}, ErrCanceled
+		}
+		return EntryMeta{}, ErrTimeout
+	}
+}
+
 // INodeUser is the interface implemented by a Raft node user type. A Raft node
 // user can be used to directly initiate proposals or read index operations
 // without locating the Raft node in NodeHost's node list first. It is useful
@@ -2033,13 +4333,14 @@ func (nu *nodeUser) ReplicaID() uint64 {
 
 func (nu *nodeUser) Propose(s *client.Session,
 	cmd []byte, timeout time.Duration) (*RequestState, error) {
-	req, err := nu.node.propose(s, cmd, nu.nh.getTimeoutTick(timeout))
+	req, err := nu.node.propose(context.Background(),
+		s, cmd, nu.nh.getTimeoutTick(timeout))
 	nu.setStepReady(s.ShardID)
 	return req, err
 }
 
 func (nu *nodeUser) ReadIndex(timeout time.Duration) (*RequestState, error) {
-	return nu.node.read(nu.nh.getTimeoutTick(timeout))
+	return nu.node.read(context.Background(), nu.nh.getTimeoutTick(timeout))
 }
 
 func getTimeoutFromContext(ctx context.Context) (time.Duration, error) {
@@ -2064,6 +4365,8 @@ type messageHandler struct {
 }
 
 var _ transport.IMessageHandler = (*messageHandler)(nil)
+var _ transport.IInboundCapacity = (*messageHandler)(nil)
+var _ transport.IReplicaLookup = (*messageHandler)(nil)
 
 func newNodeHostMessageHandler(nh *NodeHost) *messageHandler {
 	return &messageHandler{nh: nh}
@@ -2090,29 +4393,50 @@ func (h *messageHandler) HandleMessageBatch(msg pb.MessageBatch) (uint64, uint64
 		if req.To == 0 {
 			plog.Panicf("to field not set, %s", req.Type)
 		}
-		if n, ok := nh.getShard(req.ShardID); ok {
-			if n.replicaID != req.To {
-				plog.Warningf("ignored a %s message sent to %s but received by %s",
-					req.Type, dn(req.ShardID, req.To), dn(req.ShardID, n.replicaID))
-				continue
-			}
-			if req.Type == pb.InstallSnapshot {
-				n.mq.MustAdd(req)
-				snapshotCount++
-			} else if req.Type == pb.SnapshotReceived {
-				plog.Debugf("SnapshotReceived received, shard id %d, replica id %d",
-					req.ShardID, req.From)
-				n.mq.AddDelayed(pb.Message{
-					Type: pb.SnapshotStatus,
-					From: req.From,
-				}, streamConfirmedDelayTick)
-				msgCount++
+		n, ok := nh.getShard(req.ShardID)
+		if !ok {
+			nh.autoThaw(req.ShardID, req.To)
+			continue
+		}
+		if n.replicaID != req.To {
+			plog.Warningf("ignored a %s message sent to %s but received by %s",
+				req.Type, dn(req.ShardID, req.To), dn(req.ShardID, n.replicaID))
+			continue
+		}
+		if !n.checkBootstrapHash(req) || !n.checkTimings(req) ||
+			!n.checkSource(req, msg.SourceAddress) {
+			continue
+		}
+		n.recordPeerVersion(req)
+		if req.Type == pb.SnapshotForward {
+			nh.handleSnapshotForward(n, req)
+			continue
+		} else if req.Type == pb.SnapshotForwardResp {
+			nh.forwards.deliver(req)
+			continue
+		} else if req.Type == pb.SnapshotDelegate {
+			nh.handleSnapshotDelegate(n, req)
+			continue
+		} else if req.Type == pb.SnapshotDelegateResp {
+			nh.handleSnapshotDelegateResp(req)
+			continue
+		}
+		if req.Type == pb.InstallSnapshot {
+			n.mq.MustAdd(req)
+			snapshotCount++
+		} else if req.Type == pb.SnapshotReceived {
+			plog.Debugf("SnapshotReceived received, shard id %d, replica id %d",
+				req.ShardID, req.From)
+			n.mq.AddDelayed(pb.Message{
+				Type: pb.SnapshotStatus,
+				From: req.From,
+			}, streamConfirmedDelayTick)
+			msgCount++
+		} else {
+			if added, stopped := n.mq.Add(req); !added || stopped {
+				plog.Warningf("dropped an incoming message")
 			} else {
-				if added, stopped := n.mq.Add(req); !added || stopped {
-					plog.Warningf("dropped an incoming message")
-				} else {
-					msgCount++
-				}
+				msgCount++
 			}
 		}
 	}
@@ -2120,6 +4444,45 @@ func (h *messageHandler) HandleMessageBatch(msg pb.MessageBatch) (uint64, uint64
 	return snapshotCount, msgCount
 }
 
+// InboundCapacity returns the minimum remaining capacity of incoming message
+// queues of all local nodes. The window is advertised per connection rather
+// than per shard, as all shards share connections between two NodeHosts, a
+// single shard with a full queue thus pauses entry batches sent to all shards
+// on the NodeHost.
+func (h *messageHandler) InboundCapacity() (uint64, uint64) {
+	messages := uint64(math.MaxUint64)
+	bytes := uint64(math.MaxUint64)
+	h.nh.forEachShard(func(shardID uint64, n *node) bool {
+		m, b := n.mq.Capacity()
+		if m < messages {
+			messages = m
+		}
+		if b < bytes {
+			bytes = b
+		}
+		return true
+	})
+	// incoming entries are paused once the memory budget is used up
+	if h.nh.memory.enabled() {
+		if b := h.nh.memory.inboundCapacity(); b < bytes {
+			bytes = b
+		}
+	}
+	return messages, bytes
+}
+
+// HasReplica returns a boolean value indicating whether the specified replica
+// is managed by the NodeHost. Partitioned NodeHosts drop all messages, every
+// replica is considered as known so no misdelivery is reported.
+func (h *messageHandler) HasReplica(shardID uint64, replicaID uint64) bool {
+	if h.nh.isPartitioned() {
+		return true
+	}
+	n, ok := h.nh.getShard(shardID)
+	return (ok && n.replicaID == replicaID) ||
+		h.nh.frozen.contains(shardID, replicaID)
+}
+
 func (h *messageHandler) HandleSnapshotStatus(shardID uint64,
 	replicaID uint64, failed bool) {
 	eventType := server.SendSnapshotCompleted
@@ -2131,6 +4494,9 @@ func (h *messageHandler) HandleSnapshotStatus(shardID uint64,
 		ShardID:   shardID,
 		ReplicaID: replicaID,
 	})
+	if h.nh.snapshotAssisted(shardID, replicaID, failed) {
+		return
+	}
 	if n, ok := h.nh.getShard(shardID); ok {
 		n.mq.AddDelayed(pb.Message{
 			Type:   pb.SnapshotStatus,
@@ -2142,6 +4508,7 @@ func (h *messageHandler) HandleSnapshotStatus(shardID uint64,
 }
 
 func (h *messageHandler) HandleUnreachable(shardID uint64, replicaID uint64) {
+	h.nh.delegationsUnreachable(shardID, replicaID)
 	if n, ok := h.nh.getShard(shardID); ok {
 		m := pb.Message{
 			Type: pb.Unreachable,
@@ -2163,6 +4530,9 @@ func (h *messageHandler) HandleSnapshot(shardID uint64,
 	}
 	h.nh.sendMessage(m)
 	plog.Debugf("%s sent SnapshotReceived to %d", dn(shardID, replicaID), from)
+	if n, ok := h.nh.getShard(shardID); ok && n.replicaID == replicaID {
+		n.clearSnapshotReceiveInfo()
+	}
 	h.nh.events.sys.Publish(server.SystemEvent{
 		Type:      server.SnapshotReceived,
 		ShardID:   shardID,
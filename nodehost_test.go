@@ -55,6 +55,9 @@ import (
 	"github.com/lni/dragonboat/v4/internal/transport"
 	"github.com/lni/dragonboat/v4/internal/vfs"
 	chantrans "github.com/lni/dragonboat/v4/plugin/chan"
+	"github.com/lni/dragonboat/v4/plugin/clocktest"
+	"github.com/lni/dragonboat/v4/plugin/kvregistry"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
 	"github.com/lni/dragonboat/v4/raftio"
 	pb "github.com/lni/dragonboat/v4/raftpb"
 	sm "github.com/lni/dragonboat/v4/statemachine"
@@ -204,20 +207,48 @@ func waitSnapshotInfoEvent(t *testing.T, f func() []raftio.SnapshotInfo, count i
 }
 
 type testSysEventListener struct {
-	mu                    sync.Mutex
-	nodeHostShuttingdown  uint64
-	nodeUnloaded          []raftio.NodeInfo
-	nodeReady             []raftio.NodeInfo
-	membershipChanged     []raftio.NodeInfo
-	snapshotCreated       []raftio.SnapshotInfo
-	snapshotRecovered     []raftio.SnapshotInfo
-	snapshotReceived      []raftio.SnapshotInfo
-	sendSnapshotStarted   []raftio.SnapshotInfo
-	sendSnapshotCompleted []raftio.SnapshotInfo
-	snapshotCompacted     []raftio.SnapshotInfo
-	logCompacted          []raftio.EntryInfo
-	logdbCompacted        []raftio.EntryInfo
-	connectionEstablished uint64
+	mu                     sync.Mutex
+	nodeHostShuttingdown   uint64
+	nodeUnloaded           []raftio.NodeInfo
+	nodeReady              []raftio.NodeInfo
+	membershipChanged      []raftio.NodeInfo
+	snapshotCreated        []raftio.SnapshotInfo
+	snapshotRecovered      []raftio.SnapshotInfo
+	snapshotReceived       []raftio.SnapshotInfo
+	snapshotReceiveStarted []raftio.SnapshotInfo
+	sendSnapshotStarted    []raftio.SnapshotInfo
+	sendSnapshotCompleted  []raftio.SnapshotInfo
+	snapshotCompacted      []raftio.SnapshotInfo
+	logCompacted           []raftio.EntryInfo
+	logdbCompacted         []raftio.EntryInfo
+	connectionEstablished  uint64
+	connectionRejected     []raftio.ConnectionInfo
+	misdelivered           []raftio.MisdeliveredMessageInfo
+	nonVotingLagging       []raftio.NonVotingLagInfo
+	nonVotingLagRecovered  []raftio.NonVotingLagInfo
+	bootstrapMismatch      []raftio.BootstrapMismatchInfo
+	slowStateMachine       []raftio.SlowStateMachineInfo
+	slowDisk               []raftio.SlowDiskInfo
+	applyStalled           []raftio.ApplyStallInfo
+	applyStallCleared      []raftio.ApplyStallInfo
+	listenerPanicked       []raftio.ListenerPanicInfo
+	diskSpaceLow           []raftio.DiskSpaceInfo
+	diskSpaceCritical      []raftio.DiskSpaceInfo
+	diskSpaceRecovered     []raftio.DiskSpaceInfo
+	quiesceEntered         []raftio.QuiesceInfo
+	quiesceExited          []raftio.QuiesceInfo
+	logRetentionExceeded   []raftio.LogRetentionInfo
+	fingerprintMismatch    []raftio.SnapshotFingerprintInfo
+	gossipIsolated         []raftio.GossipInfo
+	gossipRejoined         []raftio.GossipInfo
+	nodeHostSuspected      []raftio.NodeHostLivenessInfo
+	nodeHostRecovered      []raftio.NodeHostLivenessInfo
+	orphanedDataPurged     []raftio.OrphanPurgeInfo
+	startupAuditFailed     []raftio.StartupAuditInfo
+	campaignSuppressed     []raftio.CampaignSuppressedInfo
+	leaderDegraded         []raftio.LeaderDegradedInfo
+	nodeRemoved            []raftio.NodeRemovedInfo
+	enginePanicked         []raftio.EnginePanicInfo
 }
 
 func copyNodeInfo(info []raftio.NodeInfo) []raftio.NodeInfo {
@@ -281,6 +312,30 @@ func (t *testSysEventListener) getConnectionEstablished() uint64 {
 }
 
 func (t *testSysEventListener) ConnectionFailed(info raftio.ConnectionInfo) {}
+func (t *testSysEventListener) ConnectionRejected(info raftio.ConnectionInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.connectionRejected = append(t.connectionRejected, info)
+}
+
+func (t *testSysEventListener) getConnectionRejected() []raftio.ConnectionInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.ConnectionInfo{}, t.connectionRejected...)
+}
+
+func (t *testSysEventListener) MisdeliveredMessage(
+	info raftio.MisdeliveredMessageInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.misdelivered = append(t.misdelivered, info)
+}
+
+func (t *testSysEventListener) getMisdelivered() []raftio.MisdeliveredMessageInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.MisdeliveredMessageInfo{}, t.misdelivered...)
+}
 
 func copySnapshotInfo(info []raftio.SnapshotInfo) []raftio.SnapshotInfo {
 	return append([]raftio.SnapshotInfo{}, info...)
@@ -311,6 +366,20 @@ func (t *testSysEventListener) getSendSnapshotCompleted() []raftio.SnapshotInfo
 }
 
 func (t *testSysEventListener) SendSnapshotAborted(info raftio.SnapshotInfo) {}
+func (t *testSysEventListener) SnapshotReceiveStarted(info raftio.SnapshotInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.snapshotReceiveStarted = append(t.snapshotReceiveStarted, info)
+}
+
+func (t *testSysEventListener) getSnapshotReceiveStarted() []raftio.SnapshotInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return copySnapshotInfo(t.snapshotReceiveStarted)
+}
+
+func (t *testSysEventListener) SnapshotReceiveProgress(info raftio.SnapshotProgressInfo) {}
+func (t *testSysEventListener) SnapshotReceiveAborted(info raftio.SnapshotAbortInfo)     {}
 func (t *testSysEventListener) SnapshotReceived(info raftio.SnapshotInfo) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -375,6 +444,286 @@ func (t *testSysEventListener) LogDBCompacted(info raftio.EntryInfo) {
 	t.logdbCompacted = append(t.logdbCompacted, info)
 }
 
+func (t *testSysEventListener) StagedPromotionTimeout(
+	info raftio.StagedPromotionInfo) {
+}
+
+func (t *testSysEventListener) NonVotingLagging(info raftio.NonVotingLagInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nonVotingLagging = append(t.nonVotingLagging, info)
+}
+
+func (t *testSysEventListener) NonVotingLagRecovered(
+	info raftio.NonVotingLagInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nonVotingLagRecovered = append(t.nonVotingLagRecovered, info)
+}
+
+func (t *testSysEventListener) BootstrapMismatch(
+	info raftio.BootstrapMismatchInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bootstrapMismatch = append(t.bootstrapMismatch, info)
+}
+
+func (t *testSysEventListener) getBootstrapMismatch() []raftio.BootstrapMismatchInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.BootstrapMismatchInfo{}, t.bootstrapMismatch...)
+}
+
+func (t *testSysEventListener) SlowStateMachine(
+	info raftio.SlowStateMachineInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.slowStateMachine = append(t.slowStateMachine, info)
+}
+
+func (t *testSysEventListener) getSlowStateMachine() []raftio.SlowStateMachineInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.SlowStateMachineInfo{}, t.slowStateMachine...)
+}
+
+func (t *testSysEventListener) SlowDisk(info raftio.SlowDiskInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.slowDisk = append(t.slowDisk, info)
+}
+
+func (t *testSysEventListener) getSlowDisk() []raftio.SlowDiskInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.SlowDiskInfo{}, t.slowDisk...)
+}
+
+func (t *testSysEventListener) ApplyStalled(info raftio.ApplyStallInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.applyStalled = append(t.applyStalled, info)
+}
+
+func (t *testSysEventListener) ApplyStallCleared(info raftio.ApplyStallInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.applyStallCleared = append(t.applyStallCleared, info)
+}
+
+func (t *testSysEventListener) getApplyStallEvents() ([]raftio.ApplyStallInfo,
+	[]raftio.ApplyStallInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.ApplyStallInfo{}, t.applyStalled...),
+		append([]raftio.ApplyStallInfo{}, t.applyStallCleared...)
+}
+
+func (t *testSysEventListener) DiskSpaceLow(info raftio.DiskSpaceInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.diskSpaceLow = append(t.diskSpaceLow, info)
+}
+
+func (t *testSysEventListener) DiskSpaceCritical(info raftio.DiskSpaceInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.diskSpaceCritical = append(t.diskSpaceCritical, info)
+}
+
+func (t *testSysEventListener) DiskSpaceRecovered(info raftio.DiskSpaceInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.diskSpaceRecovered = append(t.diskSpaceRecovered, info)
+}
+
+func (t *testSysEventListener) getDiskSpaceEvents() ([]raftio.DiskSpaceInfo,
+	[]raftio.DiskSpaceInfo, []raftio.DiskSpaceInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.DiskSpaceInfo{}, t.diskSpaceLow...),
+		append([]raftio.DiskSpaceInfo{}, t.diskSpaceCritical...),
+		append([]raftio.DiskSpaceInfo{}, t.diskSpaceRecovered...)
+}
+
+func (t *testSysEventListener) QuiesceEntered(info raftio.QuiesceInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.quiesceEntered = append(t.quiesceEntered, info)
+}
+
+func (t *testSysEventListener) QuiesceExited(info raftio.QuiesceInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.quiesceExited = append(t.quiesceExited, info)
+}
+
+func (t *testSysEventListener) LogRetentionExceeded(info raftio.LogRetentionInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.logRetentionExceeded = append(t.logRetentionExceeded, info)
+}
+
+func (t *testSysEventListener) getLogRetentionEvents() []raftio.LogRetentionInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.LogRetentionInfo{}, t.logRetentionExceeded...)
+}
+
+func (t *testSysEventListener) SnapshotFingerprintMismatch(
+	info raftio.SnapshotFingerprintInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fingerprintMismatch = append(t.fingerprintMismatch, info)
+}
+
+func (t *testSysEventListener) getFingerprintMismatch() []raftio.SnapshotFingerprintInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.SnapshotFingerprintInfo{}, t.fingerprintMismatch...)
+}
+
+func (t *testSysEventListener) GossipIsolated(info raftio.GossipInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gossipIsolated = append(t.gossipIsolated, info)
+}
+
+func (t *testSysEventListener) GossipRejoined(info raftio.GossipInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gossipRejoined = append(t.gossipRejoined, info)
+}
+
+func (t *testSysEventListener) getGossipEvents() ([]raftio.GossipInfo,
+	[]raftio.GossipInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.GossipInfo{}, t.gossipIsolated...),
+		append([]raftio.GossipInfo{}, t.gossipRejoined...)
+}
+
+func (t *testSysEventListener) NodeHostSuspected(info raftio.NodeHostLivenessInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nodeHostSuspected = append(t.nodeHostSuspected, info)
+}
+
+func (t *testSysEventListener) NodeHostRecovered(info raftio.NodeHostLivenessInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nodeHostRecovered = append(t.nodeHostRecovered, info)
+}
+
+func (t *testSysEventListener) getLivenessEvents() ([]raftio.NodeHostLivenessInfo,
+	[]raftio.NodeHostLivenessInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.NodeHostLivenessInfo{}, t.nodeHostSuspected...),
+		append([]raftio.NodeHostLivenessInfo{}, t.nodeHostRecovered...)
+}
+
+func (t *testSysEventListener) OrphanedDataPurged(info raftio.OrphanPurgeInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.orphanedDataPurged = append(t.orphanedDataPurged, info)
+}
+
+func (t *testSysEventListener) getOrphanPurgeEvents() []raftio.OrphanPurgeInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.OrphanPurgeInfo{}, t.orphanedDataPurged...)
+}
+
+func (t *testSysEventListener) StartupAuditFailed(info raftio.StartupAuditInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.startupAuditFailed = append(t.startupAuditFailed, info)
+}
+
+func (t *testSysEventListener) getStartupAuditEvents() []raftio.StartupAuditInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.StartupAuditInfo{}, t.startupAuditFailed...)
+}
+
+func (t *testSysEventListener) CampaignSuppressed(
+	info raftio.CampaignSuppressedInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.campaignSuppressed = append(t.campaignSuppressed, info)
+}
+
+func (t *testSysEventListener) getCampaignSuppressedEvents() []raftio.CampaignSuppressedInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.CampaignSuppressedInfo{}, t.campaignSuppressed...)
+}
+
+func (t *testSysEventListener) LeaderDegraded(info raftio.LeaderDegradedInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.leaderDegraded = append(t.leaderDegraded, info)
+}
+
+func (t *testSysEventListener) getLeaderDegradedEvents() []raftio.LeaderDegradedInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.LeaderDegradedInfo{}, t.leaderDegraded...)
+}
+
+func (t *testSysEventListener) NodeRemovedFromShard(info raftio.NodeRemovedInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nodeRemoved = append(t.nodeRemoved, info)
+}
+
+func (t *testSysEventListener) getNodeRemovedEvents() []raftio.NodeRemovedInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.NodeRemovedInfo{}, t.nodeRemoved...)
+}
+
+func (t *testSysEventListener) EnginePanicked(info raftio.EnginePanicInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.enginePanicked = append(t.enginePanicked, info)
+}
+
+func (t *testSysEventListener) getEnginePanicked() []raftio.EnginePanicInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.EnginePanicInfo{}, t.enginePanicked...)
+}
+
+func (t *testSysEventListener) getQuiesceEvents() ([]raftio.QuiesceInfo,
+	[]raftio.QuiesceInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.QuiesceInfo{}, t.quiesceEntered...),
+		append([]raftio.QuiesceInfo{}, t.quiesceExited...)
+}
+
+func (t *testSysEventListener) ListenerPanicked(info raftio.ListenerPanicInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listenerPanicked = append(t.listenerPanicked, info)
+}
+
+func (t *testSysEventListener) getListenerPanicked() []raftio.ListenerPanicInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.ListenerPanicInfo{}, t.listenerPanicked...)
+}
+
+func (t *testSysEventListener) getNonVotingLagEvents() ([]raftio.NonVotingLagInfo,
+	[]raftio.NonVotingLagInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]raftio.NonVotingLagInfo{}, t.nonVotingLagging...),
+		append([]raftio.NonVotingLagInfo{}, t.nonVotingLagRecovered...)
+}
+
 type TimeoutStateMachine struct {
 	updateDelay   uint64
 	lookupDelay   uint64
@@ -995,12 +1344,14 @@ func TestNodeHostRegistry(t *testing.T) {
 	}
 	nhc1.NodeHostID = nhid1.String()
 	nhc1.Gossip.Meta = []byte(testNodeHostID1)
+	nhc1.Gossip.Tags = map[string]string{"zone": "a"}
 	nhid2, err := id.NewUUID(testNodeHostID2)
 	if err != nil {
 		t.Fatalf("failed to parse nhid")
 	}
 	nhc2.NodeHostID = nhid2.String()
 	nhc2.Gossip.Meta = []byte(testNodeHostID2)
+	nhc2.Gossip.Tags = map[string]string{"zone": "b"}
 	nh1, err := NewNodeHost(nhc1)
 	if err != nil {
 		t.Fatalf("failed to create nh, %v", err)
@@ -1073,7 +1424,21 @@ func TestNodeHostRegistry(t *testing.T) {
 			v2, ok := r1.GetMeta(testNodeHostID2)
 			assert.True(t, ok)
 			assert.Equal(t, testNodeHostID2, string(v2))
-			return
+			zoneB := map[string]string{"zone": "b"}
+			assert.Equal(t, map[uint64]string{1: testNodeHostID2},
+				GetShardNodeHostsByTags(r1, 100, zoneB))
+			assert.Empty(t, GetShardNodeHostsByTags(r1, 1, zoneB))
+			// move nh1 to zone b
+			if err := nh1.UpdateGossipTags(zoneB); err != nil {
+				t.Fatalf("failed to update tags %v", err)
+			}
+			for j := 0; j < 1000; j++ {
+				if len(GetShardNodeHostsByTags(r2, 1, zoneB)) == 1 {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			t.Fatalf("updated tags not propagated")
 		}
 	}
 	t.Fatalf("failed to report the expected num of shards")
@@ -1196,1264 +1561,1774 @@ func TestGossipCanHandleDynamicRaftAddress(t *testing.T) {
 	testProposal()
 }
 
-type testRegistry struct {
-	*registry.Registry
-
-	mu *sync.Mutex // PROTECTS(nodeAddrs)
-	// map of nhid -> host:port
-	nodeAddrs map[string]string
-}
-
-func (tr *testRegistry) Resolve(shardID uint64, replicaID uint64) (string, string, error) {
-	nhid, ck, err := tr.Registry.Resolve(shardID, replicaID)
-	if err != nil {
-		return "", "", err
-	}
-	tr.mu.Lock()
-	defer tr.mu.Unlock()
-	return tr.nodeAddrs[nhid], ck, nil
-}
-
-type testRegistryFactory struct {
-	mu sync.Mutex // PROTECTS(nodeAddrs)
-	// map of nhid -> host:port
-	nodeAddrs map[string]string
-}
-
-func (trf *testRegistryFactory) Set(nhid, addr string) {
-	trf.mu.Lock()
-	defer trf.mu.Unlock()
-	trf.nodeAddrs[nhid] = addr
-}
-
-func (trf *testRegistryFactory) Create(nhid string, streamConnections uint64, v config.TargetValidator) (raftio.INodeRegistry, error) {
-	return &testRegistry{
-		registry.NewNodeRegistry(streamConnections, v),
-		&trf.mu,
-		trf.nodeAddrs,
-	}, nil
-}
-
-func TestExternalNodeRegistryFunction(t *testing.T) {
+func TestGossipKeysCanBeRotated(t *testing.T) {
 	fs := vfs.GetTestFS()
-	datadir1 := fs.PathJoin(singleNodeHostTestDir, "nh1")
-	datadir2 := fs.PathJoin(singleNodeHostTestDir, "nh2")
 	_ = os.RemoveAll(singleNodeHostTestDir)
 	defer os.RemoveAll(singleNodeHostTestDir)
-	addr1 := nodeHostTestAddr1
-	addr2 := nodeHostTestAddr2
-	nhc1 := config.NodeHostConfig{
-		NodeHostDir:    datadir1,
-		RTTMillisecond: getRTTMillisecond(fs, datadir1),
-		RaftAddress:    addr1,
-		Expert: config.ExpertConfig{
-			FS: fs,
-		},
-	}
-	nhc2 := config.NodeHostConfig{
-		NodeHostDir:    datadir2,
-		RTTMillisecond: getRTTMillisecond(fs, datadir2),
-		RaftAddress:    addr2,
-		Expert: config.ExpertConfig{
-			FS: fs,
-		},
+	oldKey := []byte("0123456789abcdef")
+	newKey := []byte("fedcba9876543210fedcba9876543210")
+	nhids := []string{testNodeHostID1, testNodeHostID2,
+		"123e4567-e89b-12d3-a456-426614174002"}
+	addrs := []string{nodeHostTestAddr1, nodeHostTestAddr2, nodeHostTestAddr3}
+	nhs := make([]*NodeHost, 0)
+	for i := 0; i < 3; i++ {
+		datadir := fs.PathJoin(singleNodeHostTestDir, fmt.Sprintf("nh%d", i+1))
+		nhc := config.NodeHostConfig{
+			NodeHostDir:                datadir,
+			RTTMillisecond:             getRTTMillisecond(fs, datadir),
+			RaftAddress:                addrs[i],
+			NodeHostID:                 nhids[i],
+			DefaultNodeRegistryEnabled: true,
+			Expert: config.ExpertConfig{
+				FS:                      fs,
+				TestGossipProbeInterval: 50 * time.Millisecond,
+			},
+			Gossip: config.GossipConfig{
+				BindAddress:      fmt.Sprintf("127.0.0.1:%d", 25001+i),
+				AdvertiseAddress: fmt.Sprintf("127.0.0.1:%d", 25001+i),
+				Seed:             []string{"127.0.0.1:25001", "127.0.0.1:25002"},
+				Keys:             [][]byte{oldKey},
+			},
+		}
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			t.Fatalf("failed to create nh, %v", err)
+		}
+		defer nh.Close()
+		nhs = append(nhs, nh)
 	}
-	nhid1, err := id.NewUUID(testNodeHostID1)
-	if err != nil {
-		t.Fatalf("failed to parse nhid")
+	resolvable := func() bool {
+		for _, nh := range nhs {
+			r, ok := nh.GetNodeHostRegistry()
+			if !ok {
+				return false
+			}
+			for _, nhid := range nhids {
+				if _, ok := r.GetMeta(nhid); !ok {
+					return false
+				}
+			}
+		}
+		return true
 	}
-	nhc1.NodeHostID = nhid1.String()
-	nhid2, err := id.NewUUID(testNodeHostID2)
-	if err != nil {
-		t.Fatalf("failed to parse nhid")
+	for i := 0; i < 1000 && !resolvable(); i++ {
+		time.Sleep(10 * time.Millisecond)
 	}
-	nhc2.NodeHostID = nhid2.String()
-	testRegistryFactory := &testRegistryFactory{
-		nodeAddrs: map[string]string{
-			nhc1.NodeHostID: nodeHostTestAddr1,
-			nhc2.NodeHostID: nodeHostTestAddr2,
-		},
+	if !resolvable() {
+		t.Fatalf("gossip mesh not formed")
 	}
-	nhc1.Expert.NodeRegistryFactory = testRegistryFactory
-	nhc2.Expert.NodeRegistryFactory = testRegistryFactory
+	stopper := syncutil.NewStopper()
+	var failures uint64
+	stopper.RunWorker(func() {
+		for {
+			select {
+			case <-stopper.ShouldStop():
+				return
+			case <-time.After(10 * time.Millisecond):
+				if !resolvable() {
+					atomic.AddUint64(&failures, 1)
+				}
+			}
+		}
+	})
+	phase := func(op func(*NodeHost) error) {
+		for _, nh := range nhs {
+			if err := op(nh); err != nil {
+				t.Fatalf("keyring operation failed %v", err)
+			}
+		}
+		// allow a few suspicion timeouts to pass
+		time.Sleep(time.Second)
+	}
+	phase(func(nh *NodeHost) error { return nh.AddGossipKey(newKey) })
+	phase(func(nh *NodeHost) error { return nh.UseGossipKey(newKey) })
+	phase(func(nh *NodeHost) error { return nh.RemoveGossipKey(oldKey) })
+	stopper.Stop()
+	if v := atomic.LoadUint64(&failures); v > 0 {
+		t.Errorf("registry resolution failed %d times during rotation", v)
+	}
+	var fingerprints []string
+	for _, nh := range nhs {
+		gi := nh.GetNodeHostInfo(DefaultNodeHostInfoOption).Gossip
+		if gi.NumOfKnownNodeHosts != 3 {
+			t.Errorf("unexpected member count %d", gi.NumOfKnownNodeHosts)
+		}
+		if len(gi.KeyFingerprints) != 1 {
+			t.Fatalf("unexpected fingerprints %v", gi.KeyFingerprints)
+		}
+		if fingerprints != nil && fingerprints[0] != gi.KeyFingerprints[0] {
+			t.Errorf("inconsistent fingerprints")
+		}
+		fingerprints = gi.KeyFingerprints
+	}
+	if err := nhs[0].RemoveGossipKey(newKey); !errors.Is(err, ErrInvalidGossipKey) {
+		t.Errorf("primary key removed, %v", err)
+	}
+	if err := nhs[0].UseGossipKey(oldKey); !errors.Is(err, ErrInvalidGossipKey) {
+		t.Errorf("removed key used, %v", err)
+	}
+}
 
-	nh1, err := NewNodeHost(nhc1)
+func TestShardPlacementConvergesAfterLeaderTransfer(t *testing.T) {
+	fs := vfs.GetTestFS()
+	_ = os.RemoveAll(singleNodeHostTestDir)
+	defer os.RemoveAll(singleNodeHostTestDir)
+	nhids := []string{testNodeHostID1, testNodeHostID2}
+	addrs := []string{nodeHostTestAddr1, nodeHostTestAddr2}
+	nhs := make([]*NodeHost, 0)
+	for i := 0; i < 2; i++ {
+		datadir := fs.PathJoin(singleNodeHostTestDir, fmt.Sprintf("nh%d", i+1))
+		nhc := config.NodeHostConfig{
+			NodeHostDir:                datadir,
+			RTTMillisecond:             getRTTMillisecond(fs, datadir),
+			RaftAddress:                addrs[i],
+			NodeHostID:                 nhids[i],
+			DefaultNodeRegistryEnabled: true,
+			Expert: config.ExpertConfig{
+				FS:                      fs,
+				TestGossipProbeInterval: 50 * time.Millisecond,
+			},
+			Gossip: config.GossipConfig{
+				BindAddress:      fmt.Sprintf("127.0.0.1:%d", 25001+i),
+				AdvertiseAddress: fmt.Sprintf("127.0.0.1:%d", 25001+i),
+				Seed:             []string{fmt.Sprintf("127.0.0.1:%d", 25002-i)},
+			},
+		}
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			t.Fatalf("failed to create nh, %v", err)
+		}
+		defer nh.Close()
+		nhs = append(nhs, nh)
+	}
+	peers := map[uint64]string{1: testNodeHostID1, 2: testNodeHostID2}
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &PST{}
+	}
+	for i, nh := range nhs {
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    uint64(i + 1),
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+		}
+		if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+			t.Fatalf("failed to start node %v", err)
+		}
+	}
+	waitForLeaderToBeElected(t, nhs[0], 1)
+	// waitForPlacement waits until the placement of shard 1 on all NodeHost
+	// instances reports the specified leader
+	waitForPlacement := func(leaderID uint64) {
+		for i := 0; i < 1000; i++ {
+			converged := true
+			for _, nh := range nhs {
+				r, ok := nh.GetNodeHostRegistry()
+				assert.True(t, ok)
+				p, ok := r.GetShardPlacement(1)
+				if !ok || p.LeaderID != leaderID || len(p.Replicas) != 2 {
+					converged = false
+					break
+				}
+				for idx, rp := range p.Replicas {
+					if rp.ReplicaID != uint64(idx+1) ||
+						rp.NodeHostID != nhids[idx] ||
+						rp.RaftAddress != addrs[idx] ||
+						rp.Role != Voter ||
+						rp.IsLeader != (rp.ReplicaID == leaderID) {
+						converged = false
+					}
+				}
+				if p.UpdatedAt.IsZero() {
+					t.Errorf("UpdatedAt not set")
+				}
+			}
+			if converged {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("placement failed to converge to leader %d", leaderID)
+	}
+	var leaderID uint64
+	for i := 0; i < 1000; i++ {
+		id, _, ok, err := nhs[0].GetLeaderID(1)
+		if err == nil && ok {
+			leaderID = id
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if leaderID == 0 {
+		t.Fatalf("failed to get leader")
+	}
+	waitForPlacement(leaderID)
+	target := 3 - leaderID
+	for i := 0; i < 100; i++ {
+		if err := nhs[0].RequestLeaderTransfer(1, target); err != nil {
+			t.Fatalf("failed to request leader transfer %v", err)
+		}
+		id, _, ok, err := nhs[0].GetLeaderID(1)
+		if err == nil && ok && id == target {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	waitForPlacement(target)
+	r, _ := nhs[1].GetNodeHostRegistry()
+	shards := r.ListShards(ShardFilter{NodeHostID: testNodeHostID1})
+	if len(shards) != 1 || shards[0].ShardID != 1 {
+		t.Errorf("unexpected shards %+v", shards)
+	}
+}
+
+func TestSuspectNodeHostIsNotDialed(t *testing.T) {
+	fs := vfs.GetTestFS()
+	_ = os.RemoveAll(singleNodeHostTestDir)
+	defer os.RemoveAll(singleNodeHostTestDir)
+	nhids := []string{testNodeHostID1, testNodeHostID2,
+		"123e4567-e89b-12d3-a456-426614174002"}
+	addrs := []string{nodeHostTestAddr1, nodeHostTestAddr2, nodeHostTestAddr3}
+	listener := &testSysEventListener{}
+	nhs := make([]*NodeHost, 0)
+	for i := 0; i < 3; i++ {
+		datadir := fs.PathJoin(singleNodeHostTestDir, fmt.Sprintf("nh%d", i+1))
+		nhc := config.NodeHostConfig{
+			NodeHostDir:                datadir,
+			RTTMillisecond:             getRTTMillisecond(fs, datadir),
+			RaftAddress:                addrs[i],
+			NodeHostID:                 nhids[i],
+			DefaultNodeRegistryEnabled: true,
+			Expert: config.ExpertConfig{
+				FS:                      fs,
+				TestGossipProbeInterval: 50 * time.Millisecond,
+			},
+			Gossip: config.GossipConfig{
+				BindAddress:        fmt.Sprintf("127.0.0.1:%d", 25001+i),
+				AdvertiseAddress:   fmt.Sprintf("127.0.0.1:%d", 25001+i),
+				Seed:               []string{"127.0.0.1:25001", "127.0.0.1:25002"},
+				SuspectGracePeriod: 200 * time.Millisecond,
+			},
+		}
+		if i == 0 {
+			nhc.SystemEventListener = listener
+		}
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			t.Fatalf("failed to create nh, %v", err)
+		}
+		nhs = append(nhs, nh)
+	}
+	defer nhs[0].Close()
+	defer nhs[1].Close()
+	peers := map[uint64]string{1: nhids[0], 2: nhids[1], 3: nhids[2]}
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &PST{}
+	}
+	for i, nh := range nhs {
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    uint64(i + 1),
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+		}
+		if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+			t.Fatalf("failed to start node %v", err)
+		}
+	}
+	waitForLeaderToBeElected(t, nhs[0], 1)
+	nhs[2].Close()
+	suspected := func() bool {
+		events, _ := listener.getLivenessEvents()
+		return len(events) > 0
+	}
+	for i := 0; i < 1000 && !suspected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	events, _ := listener.getLivenessEvents()
+	if len(events) != 1 || events[0].NodeHostID != nhids[2] ||
+		events[0].RaftAddress != addrs[2] {
+		t.Fatalf("unexpected NodeHostSuspected events %+v", events)
+	}
+	dials := func() uint64 {
+		for _, s := range nhs[0].GetTransportStats() {
+			if s.Address == addrs[2] {
+				return s.ConnectionsEstablished + s.ConnectionsFailed
+			}
+		}
+		return 0
+	}
+	// heartbeats keep being sent to replica 3, none of them should dial it
+	before := dials()
+	time.Sleep(time.Second)
+	if after := dials(); after != before {
+		t.Errorf("suspect NodeHost dialed %d times", after-before)
+	}
+	r, ok := nhs[0].GetNodeHostRegistry()
+	if !ok {
+		t.Fatalf("failed to get registry")
+	}
+	p, ok := r.GetShardPlacement(1)
+	if !ok || len(p.Replicas) != 3 {
+		t.Fatalf("unexpected placement %+v", p)
+	}
+	if p.Replicas[0].Liveness != NodeHostAlive ||
+		p.Replicas[2].Liveness == NodeHostAlive {
+		t.Errorf("unexpected liveness in placement %+v", p)
+	}
+}
+
+func TestNodeHostCanBeReplacedWithPreservedNodeHostID(t *testing.T) {
+	fs := vfs.GetTestFS()
+	if fs != vfs.DefaultFS {
+		t.Skip("memfs test mode, skipped")
+	}
+	_ = os.RemoveAll(singleNodeHostTestDir)
+	defer os.RemoveAll(singleNodeHostTestDir)
+	getConfig := func(dir string, addr string, port int,
+		nhid string) config.NodeHostConfig {
+		datadir := fs.PathJoin(singleNodeHostTestDir, dir)
+		return config.NodeHostConfig{
+			NodeHostDir:                datadir,
+			RTTMillisecond:             getRTTMillisecond(fs, datadir),
+			RaftAddress:                addr,
+			NodeHostID:                 nhid,
+			DefaultNodeRegistryEnabled: true,
+			Expert: config.ExpertConfig{
+				FS:                      fs,
+				TestGossipProbeInterval: 50 * time.Millisecond,
+			},
+			Gossip: config.GossipConfig{
+				BindAddress:      fmt.Sprintf("127.0.0.1:%d", port),
+				AdvertiseAddress: fmt.Sprintf("127.0.0.1:%d", port),
+				Seed:             []string{"127.0.0.1:25001", "127.0.0.1:25002"},
+			},
+		}
+	}
+	nh1, err := NewNodeHost(getConfig("nh1", nodeHostTestAddr1, 25001, ""))
 	if err != nil {
 		t.Fatalf("failed to create nh, %v", err)
 	}
 	defer nh1.Close()
-	nh2, err := NewNodeHost(nhc2)
+	nh2, err := NewNodeHost(getConfig("nh2", nodeHostTestAddr2, 25002, ""))
 	if err != nil {
-		t.Fatalf("failed to create nh2, %v", err)
+		t.Fatalf("failed to create nh, %v", err)
 	}
-	nh2NodeHostID := nh2.ID()
-	peers := make(map[uint64]string)
-	peers[1] = testNodeHostID1
-	peers[2] = testNodeHostID2
+	nhid := nh2.ID()
+	peers := map[uint64]string{1: nh1.ID(), 2: nhid}
 	createSM := func(uint64, uint64) sm.IStateMachine {
 		return &PST{}
 	}
-	rc := config.Config{
-		ShardID:         1,
-		ReplicaID:       1,
-		ElectionRTT:     3,
-		HeartbeatRTT:    1,
-		SnapshotEntries: 0,
+	getReplicaConfig := func(replicaID uint64) config.Config {
+		return config.Config{
+			ShardID:      1,
+			ReplicaID:    replicaID,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+		}
 	}
-	if err := nh1.StartReplica(peers, false, createSM, rc); err != nil {
+	if err := nh1.StartReplica(peers, false, createSM, getReplicaConfig(1)); err != nil {
 		t.Fatalf("failed to start node %v", err)
 	}
-	rc.ReplicaID = 2
-	if err := nh2.StartReplica(peers, false, createSM, rc); err != nil {
+	if err := nh2.StartReplica(peers, false, createSM, getReplicaConfig(2)); err != nil {
 		t.Fatalf("failed to start node %v", err)
 	}
 	waitForLeaderToBeElected(t, nh1, 1)
-	waitForLeaderToBeElected(t, nh2, 1)
-	pto := lpto(nh1)
-	session := nh1.GetNoOPSession(1)
-	testProposal := func() {
-		done := false
+	propose := func() bool {
 		for i := 0; i < 100; i++ {
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			_, err := nh1.SyncPropose(ctx, session, make([]byte, 0))
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			_, err := nh1.SyncPropose(ctx, nh1.GetNoOPSession(1), []byte("test"))
 			cancel()
-			if err != nil {
-				time.Sleep(100 * time.Millisecond)
-				continue
+			if err == nil {
+				return true
 			}
-			done = true
-			break
-		}
-		if !done {
-			t.Fatalf("failed to make proposal")
+			time.Sleep(50 * time.Millisecond)
 		}
+		return false
 	}
-	testProposal()
+	if !propose() {
+		t.Fatalf("failed to make proposal")
+	}
+	// the host running nh2 is lost, its NodeHost directory is restored from
+	// backup on a new host with a different RaftAddress
 	nh2.Close()
-	nhc2.RaftAddress = nodeHostTestAddr3
-	testRegistryFactory.Set(nh2NodeHostID, nodeHostTestAddr3)
-	nh2, err = NewNodeHost(nhc2)
+	restored := fs.PathJoin(singleNodeHostTestDir, "nh2-restored")
+	if err := fs.Rename(fs.PathJoin(singleNodeHostTestDir, "nh2"),
+		restored); err != nil {
+		t.Fatalf("failed to rename %v", err)
+	}
+	v, err := tools.ReadNodeHostID(restored)
 	if err != nil {
-		t.Fatalf("failed to restart nh2, %v", err)
+		t.Fatalf("failed to read NodeHostID %v", err)
 	}
-	defer nh2.Close()
-	if nh2.ID() != nh2NodeHostID {
-		t.Fatalf("NodeHostID changed, got %s, want %s", nh2.ID(), nh2NodeHostID)
+	if v != nhid {
+		t.Fatalf("unexpected NodeHostID %s, want %s", v, nhid)
 	}
-	if err := nh2.StartReplica(peers, false, createSM, rc); err != nil {
-		t.Fatalf("failed to start node %v", err)
+	if err := tools.WriteNodeHostID(restored, nhid); err != nil {
+		t.Fatalf("failed to write NodeHostID %v", err)
 	}
-	waitForLeaderToBeElected(t, nh2, 1)
-	testProposal()
-}
-
-func TestNewNodeHostReturnErrorOnInvalidConfig(t *testing.T) {
-	fs := vfs.GetTestFS()
-	to := &testOption{
-		updateNodeHostConfig: func(nhc *config.NodeHostConfig) *config.NodeHostConfig {
-			nhc.RaftAddress = "12345"
-			if err := nhc.Validate(); err == nil {
-				t.Fatalf("config is not considered as invalid")
-			}
-			return nhc
-		},
-		newNodeHostToFail: true,
+	if err := tools.WriteNodeHostID(restored,
+		nh1.ID()); !errors.Is(err, tools.ErrNodeHostIDChanged) {
+		t.Fatalf("NodeHostID overwritten, %v", err)
+	}
+	nhc := getConfig("nh2-restored", nodeHostTestAddr3, 25003, nh1.ID())
+	if _, err := NewNodeHost(nhc); !errors.Is(err, server.ErrNodeHostIDChanged) {
+		t.Fatalf("mismatched NodeHostID not rejected, %v", err)
+	}
+	nhc.NodeHostID = nhid
+	nh3, err := NewNodeHost(nhc)
+	if err != nil {
+		t.Fatalf("failed to create nh, %v", err)
+	}
+	defer nh3.Close()
+	if nh3.ID() != nhid {
+		t.Fatalf("NodeHostID not preserved")
+	}
+	if err := nh3.StartReplica(nil, false, createSM, getReplicaConfig(2)); err != nil {
+		t.Fatalf("failed to restart node %v", err)
+	}
+	// gossip converges to the new RaftAddress of the preserved NodeHostID
+	r, ok := nh1.GetNodeHostRegistry()
+	if !ok {
+		t.Fatalf("failed to get registry")
+	}
+	converged := func() bool {
+		p, ok := r.GetShardPlacement(1)
+		return ok && len(p.Replicas) == 2 &&
+			p.Replicas[1].NodeHostID == nhid &&
+			p.Replicas[1].RaftAddress == nodeHostTestAddr3
+	}
+	for i := 0; i < 1000 && !converged(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !converged() {
+		t.Fatalf("gossip failed to converge to the new RaftAddress")
+	}
+	// both replicas are required to commit proposals
+	if !propose() {
+		t.Fatalf("failed to make proposal after host replacement")
 	}
-	runNodeHostTest(t, to, fs)
 }
 
-func TestDeploymentIDCanBeSetUsingNodeHostConfig(t *testing.T) {
+func TestRegistryWatcherConvergesToPolledView(t *testing.T) {
 	fs := vfs.GetTestFS()
-	to := &testOption{
-		updateNodeHostConfig: func(nhc *config.NodeHostConfig) *config.NodeHostConfig {
-			nhc.DeploymentID = 1000
-			return nhc
-		},
-		tf: func(nh *NodeHost) {
-			nhc := nh.NodeHostConfig()
-			if did := nhc.GetDeploymentID(); did != 1000 {
-				t.Errorf("unexpected did: %d", did)
-			}
-		},
-		noElection: true,
-	}
-	runNodeHostTest(t, to, fs)
+	_ = os.RemoveAll(singleNodeHostTestDir)
+	defer os.RemoveAll(singleNodeHostTestDir)
+	nhids := []string{testNodeHostID1, testNodeHostID2}
+	addrs := []string{nodeHostTestAddr1, nodeHostTestAddr2}
+	getConfig := func(i int) config.NodeHostConfig {
+		datadir := fs.PathJoin(singleNodeHostTestDir, fmt.Sprintf("nh%d", i+1))
+		return config.NodeHostConfig{
+			NodeHostDir:                datadir,
+			RTTMillisecond:             getRTTMillisecond(fs, datadir),
+			RaftAddress:                addrs[i],
+			NodeHostID:                 nhids[i],
+			DefaultNodeRegistryEnabled: true,
+			Expert: config.ExpertConfig{
+				FS:                      fs,
+				TestGossipProbeInterval: 50 * time.Millisecond,
+			},
+			Gossip: config.GossipConfig{
+				BindAddress:      fmt.Sprintf("127.0.0.1:%d", 25001+i),
+				AdvertiseAddress: fmt.Sprintf("127.0.0.1:%d", 25001+i),
+				Seed:             []string{fmt.Sprintf("127.0.0.1:%d", 25002-i)},
+			},
+		}
+	}
+	nh1, err := NewNodeHost(getConfig(0))
+	if err != nil {
+		t.Fatalf("failed to create nh, %v", err)
+	}
+	defer nh1.Close()
+	r, ok := nh1.GetNodeHostRegistry()
+	if !ok {
+		t.Fatalf("failed to get registry")
+	}
+	ch, cancel := r.Watch(1024)
+	// the routing table maintained by the watcher
+	var mu sync.Mutex
+	nodes := make(map[string]string)
+	shards := make(map[uint64]ShardPlacement)
+	resyncs := 0
+	stopper := syncutil.NewStopper()
+	defer stopper.Stop()
+	// canceling the watch closes ch and stops the worker below
+	defer cancel()
+	stopper.RunWorker(func() {
+		for e := range ch {
+			mu.Lock()
+			switch e.Type {
+			case NodeHostJoined, NodeHostAddressChanged:
+				nodes[e.NodeHostID] = e.RaftAddress
+			case NodeHostLeft:
+				delete(nodes, e.NodeHostID)
+			case ShardReplicasChanged, ShardLeaderChanged:
+				if e.Shard.Term >= shards[e.Shard.ShardID].Term {
+					shards[e.Shard.ShardID] = e.Shard
+				}
+			case Resync:
+				resyncs++
+				for _, p := range r.ListShards(ShardFilter{}) {
+					shards[p.ShardID] = p
+				}
+			}
+			mu.Unlock()
+		}
+	})
+	nh2, err := NewNodeHost(getConfig(1))
+	if err != nil {
+		t.Fatalf("failed to create nh, %v", err)
+	}
+	defer func() {
+		if nh2 != nil {
+			nh2.Close()
+		}
+	}()
+	peers := map[uint64]string{1: testNodeHostID1, 2: testNodeHostID2}
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &PST{}
+	}
+	for i, nh := range []*NodeHost{nh1, nh2} {
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    uint64(i + 1),
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+		}
+		if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+			t.Fatalf("failed to start node %v", err)
+		}
+	}
+	waitForLeaderToBeElected(t, nh1, 1)
+	// converged checks whether the placement known to the watcher matches the
+	// polled one with the specified leader. nh1 joined before the watch was
+	// created, only nh2 is expected to be reported by the watcher.
+	converged := func(leaderID uint64) bool {
+		polled, ok := r.GetShardPlacement(1)
+		if !ok || polled.LeaderID != leaderID {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		watched, ok := shards[1]
+		if !ok || watched.LeaderID != polled.LeaderID ||
+			watched.Term != polled.Term ||
+			watched.ConfigChangeIndex != polled.ConfigChangeIndex ||
+			len(watched.Replicas) != len(polled.Replicas) {
+			return false
+		}
+		for _, rp := range polled.Replicas {
+			if rp.NodeHostID == testNodeHostID2 &&
+				nodes[rp.NodeHostID] != rp.RaftAddress {
+				return false
+			}
+		}
+		return true
+	}
+	waitForConvergence := func(leaderID uint64) {
+		for i := 0; i < 1000 && !converged(leaderID); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !converged(leaderID) {
+			t.Fatalf("watcher failed to converge to leader %d", leaderID)
+		}
+	}
+	var leaderID uint64
+	for i := 0; i < 1000; i++ {
+		id, _, ok, err := nh1.GetLeaderID(1)
+		if err == nil && ok {
+			leaderID = id
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if leaderID == 0 {
+		t.Fatalf("failed to get leader")
+	}
+	waitForConvergence(leaderID)
+	target := 3 - leaderID
+	for i := 0; i < 100; i++ {
+		if err := nh1.RequestLeaderTransfer(1, target); err != nil {
+			t.Fatalf("failed to request leader transfer %v", err)
+		}
+		id, _, ok, err := nh1.GetLeaderID(1)
+		if err == nil && ok && id == target {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	waitForConvergence(target)
+	nh2.Close()
+	nh2 = nil
+	left := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		_, ok := nodes[testNodeHostID2]
+		return !ok
+	}
+	for i := 0; i < 1000 && !left(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !left() {
+		t.Errorf("NodeHostLeft not observed")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if resyncs != 0 {
+		t.Errorf("unexpected resync")
+	}
 }
 
-var (
-	singleNodeHostTestAddr = fmt.Sprintf("localhost:%d", getTestPort())
-	nodeHostTestAddr1      = fmt.Sprintf("localhost:%d", getTestPort())
-	nodeHostTestAddr2      = fmt.Sprintf("localhost:%d", getTestPort()+1)
-	nodeHostTestAddr3      = fmt.Sprintf("localhost:%d", getTestPort()+2)
-	singleNodeHostTestDir  = "single_nodehost_test_dir_safe_to_delete"
-)
+type testRegistry struct {
+	*registry.Registry
 
-type PST struct {
-	mu       sync.Mutex
-	stopped  bool
-	saved    bool
-	restored bool
-	slowSave bool
+	mu *sync.Mutex // PROTECTS(nodeAddrs)
+	// map of nhid -> host:port
+	nodeAddrs map[string]string
 }
 
-func (n *PST) setRestored(v bool) {
-	n.mu.Lock()
-	defer n.mu.Unlock()
-	n.restored = v
+func (tr *testRegistry) Resolve(shardID uint64, replicaID uint64) (string, string, error) {
+	nhid, ck, err := tr.Registry.Resolve(shardID, replicaID)
+	if err != nil {
+		return "", "", err
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.nodeAddrs[nhid], ck, nil
 }
 
-func (n *PST) getRestored() bool {
-	n.mu.Lock()
-	defer n.mu.Unlock()
-	return n.restored
+type testRegistryFactory struct {
+	mu sync.Mutex // PROTECTS(nodeAddrs)
+	// map of nhid -> host:port
+	nodeAddrs map[string]string
 }
 
-func (n *PST) Close() error { return nil }
-
-// Lookup locally looks up the data.
-func (n *PST) Lookup(key interface{}) (interface{}, error) {
-	return make([]byte, 1), nil
+func (trf *testRegistryFactory) Set(nhid, addr string) {
+	trf.mu.Lock()
+	defer trf.mu.Unlock()
+	trf.nodeAddrs[nhid] = addr
 }
 
-// Update updates the object.
-func (n *PST) Update(e sm.Entry) (sm.Result, error) {
-	return sm.Result{Value: uint64(len(e.Cmd))}, nil
+func (trf *testRegistryFactory) Create(nhid string, streamConnections uint64, v config.TargetValidator) (raftio.INodeRegistry, error) {
+	return &testRegistry{
+		registry.NewNodeRegistry(streamConnections, v),
+		&trf.mu,
+		trf.nodeAddrs,
+	}, nil
 }
 
-// SaveSnapshot saves the state of the object to the provided io.Writer object.
-func (n *PST) SaveSnapshot(w io.Writer,
-	fileCollection sm.ISnapshotFileCollection,
-	done <-chan struct{}) error {
-	n.saved = true
-	if !n.slowSave {
-		_, err := w.Write([]byte("random-data"))
-		if err != nil {
-			panic(err)
-		}
-		return nil
+func TestExternalNodeRegistryFunction(t *testing.T) {
+	fs := vfs.GetTestFS()
+	datadir1 := fs.PathJoin(singleNodeHostTestDir, "nh1")
+	datadir2 := fs.PathJoin(singleNodeHostTestDir, "nh2")
+	_ = os.RemoveAll(singleNodeHostTestDir)
+	defer os.RemoveAll(singleNodeHostTestDir)
+	addr1 := nodeHostTestAddr1
+	addr2 := nodeHostTestAddr2
+	nhc1 := config.NodeHostConfig{
+		NodeHostDir:    datadir1,
+		RTTMillisecond: getRTTMillisecond(fs, datadir1),
+		RaftAddress:    addr1,
+		Expert: config.ExpertConfig{
+			FS: fs,
+		},
 	}
-	for {
-		time.Sleep(10 * time.Millisecond)
-		select {
-		case <-done:
-			n.stopped = true
-			return sm.ErrSnapshotStopped
-		default:
-		}
+	nhc2 := config.NodeHostConfig{
+		NodeHostDir:    datadir2,
+		RTTMillisecond: getRTTMillisecond(fs, datadir2),
+		RaftAddress:    addr2,
+		Expert: config.ExpertConfig{
+			FS: fs,
+		},
 	}
-}
-
-// RecoverFromSnapshot recovers the object from the snapshot specified by the
-// io.Reader object.
-func (n *PST) RecoverFromSnapshot(r io.Reader,
-	files []sm.SnapshotFile, done <-chan struct{}) error {
-	n.setRestored(true)
-	for {
-		time.Sleep(10 * time.Millisecond)
-		select {
-		case <-done:
-			n.stopped = true
-			return sm.ErrSnapshotStopped
-		default:
-		}
+	nhid1, err := id.NewUUID(testNodeHostID1)
+	if err != nil {
+		t.Fatalf("failed to parse nhid")
 	}
-}
-
-// GetHash returns a uint64 value representing the current state of the object.
-func (n *PST) GetHash() (uint64, error) {
-	return 0, nil
-}
-
-func createConcurrentTestNodeHost(addr string,
-	datadir string, snapshotEntry uint64,
-	concurrent bool, fs vfs.IFS) (*NodeHost, error) {
-	// config for raft
-	rc := config.Config{
-		ReplicaID:          uint64(1),
-		ElectionRTT:        3,
-		HeartbeatRTT:       1,
-		CheckQuorum:        true,
-		SnapshotEntries:    snapshotEntry,
-		CompactionOverhead: 100,
+	nhc1.NodeHostID = nhid1.String()
+	nhid2, err := id.NewUUID(testNodeHostID2)
+	if err != nil {
+		t.Fatalf("failed to parse nhid")
 	}
-	peers := make(map[uint64]string)
-	peers[1] = addr
-	nhc := config.NodeHostConfig{
-		WALDir:         datadir,
-		NodeHostDir:    datadir,
-		RTTMillisecond: getRTTMillisecond(fs, datadir),
-		RaftAddress:    peers[1],
-		Expert:         getTestExpertConfig(fs),
+	nhc2.NodeHostID = nhid2.String()
+	testRegistryFactory := &testRegistryFactory{
+		nodeAddrs: map[string]string{
+			nhc1.NodeHostID: nodeHostTestAddr1,
+			nhc2.NodeHostID: nodeHostTestAddr2,
+		},
 	}
-	nh, err := NewNodeHost(nhc)
+	nhc1.Expert.NodeRegistryFactory = testRegistryFactory
+	nhc2.Expert.NodeRegistryFactory = testRegistryFactory
+
+	nh1, err := NewNodeHost(nhc1)
 	if err != nil {
-		return nil, err
+		t.Fatalf("failed to create nh, %v", err)
 	}
-	var newConcurrentSM func(uint64, uint64) sm.IConcurrentStateMachine
-	var newSM func(uint64, uint64) sm.IStateMachine
-	if snapshotEntry == 0 {
-		newConcurrentSM = func(uint64, uint64) sm.IConcurrentStateMachine {
-			return &tests.ConcurrentUpdate{}
-		}
-		newSM = func(uint64, uint64) sm.IStateMachine {
-			return &tests.TestUpdate{}
-		}
-	} else {
-		newConcurrentSM = func(uint64, uint64) sm.IConcurrentStateMachine {
-			return &tests.ConcurrentSnapshot{}
-		}
-		newSM = func(uint64, uint64) sm.IStateMachine {
-			return &tests.TestSnapshot{}
-		}
+	defer nh1.Close()
+	nh2, err := NewNodeHost(nhc2)
+	if err != nil {
+		t.Fatalf("failed to create nh2, %v", err)
 	}
-	rc.ShardID = 1 + nhc.Expert.Engine.ApplyShards
-	if err := nh.StartConcurrentReplica(peers, false, newConcurrentSM, rc); err != nil {
-		return nil, err
+	nh2NodeHostID := nh2.ID()
+	peers := make(map[uint64]string)
+	peers[1] = testNodeHostID1
+	peers[2] = testNodeHostID2
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &PST{}
 	}
-	rc.ShardID = 1
-	if err := nh.StartReplica(peers, false, newSM, rc); err != nil {
-		return nil, err
+	rc := config.Config{
+		ShardID:         1,
+		ReplicaID:       1,
+		ElectionRTT:     3,
+		HeartbeatRTT:    1,
+		SnapshotEntries: 0,
 	}
-	return nh, nil
-}
-
-func singleConcurrentNodeHostTest(t *testing.T,
-	tf func(t *testing.T, nh *NodeHost),
-	snapshotEntry uint64, concurrent bool, fs vfs.IFS) {
-	defer func() {
-		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
-			t.Fatalf("%v", err)
-		}
-	}()
-	func() {
-		defer leaktest.AfterTest(t)()
-		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
-			t.Fatalf("%v", err)
+	if err := nh1.StartReplica(peers, false, createSM, rc); err != nil {
+		t.Fatalf("failed to start node %v", err)
+	}
+	rc.ReplicaID = 2
+	if err := nh2.StartReplica(peers, false, createSM, rc); err != nil {
+		t.Fatalf("failed to start node %v", err)
+	}
+	waitForLeaderToBeElected(t, nh1, 1)
+	waitForLeaderToBeElected(t, nh2, 1)
+	pto := lpto(nh1)
+	session := nh1.GetNoOPSession(1)
+	testProposal := func() {
+		done := false
+		for i := 0; i < 100; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			_, err := nh1.SyncPropose(ctx, session, make([]byte, 0))
+			cancel()
+			if err != nil {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			done = true
+			break
 		}
-		nh, err := createConcurrentTestNodeHost(singleNodeHostTestAddr,
-			singleNodeHostTestDir, snapshotEntry, concurrent, fs)
-		if err != nil {
-			t.Fatalf("failed to create nodehost %v", err)
+		if !done {
+			t.Fatalf("failed to make proposal")
 		}
-		defer func() {
-			nh.Close()
-		}()
-		nhc := nh.NodeHostConfig()
-		waitForLeaderToBeElected(t, nh, 1)
-		waitForLeaderToBeElected(t, nh, 1+nhc.Expert.Engine.ApplyShards)
-		tf(t, nh)
-	}()
-	reportLeakedFD(fs, t)
+	}
+	testProposal()
+	nh2.Close()
+	nhc2.RaftAddress = nodeHostTestAddr3
+	testRegistryFactory.Set(nh2NodeHostID, nodeHostTestAddr3)
+	nh2, err = NewNodeHost(nhc2)
+	if err != nil {
+		t.Fatalf("failed to restart nh2, %v", err)
+	}
+	defer nh2.Close()
+	if nh2.ID() != nh2NodeHostID {
+		t.Fatalf("NodeHostID changed, got %s, want %s", nh2.ID(), nh2NodeHostID)
+	}
+	if err := nh2.StartReplica(peers, false, createSM, rc); err != nil {
+		t.Fatalf("failed to start node %v", err)
+	}
+	waitForLeaderToBeElected(t, nh2, 1)
+	testProposal()
 }
 
-func twoFakeDiskNodeHostTest(t *testing.T,
-	tf func(t *testing.T, nh1 *NodeHost, nh2 *NodeHost), fs vfs.IFS) {
+func writeStaticRegistryFile(t *testing.T,
+	fs vfs.IFS, fn string, addrs map[string]string) {
+	content := `{"nodehosts": [`
+	sep := ""
+	for nhid, addr := range addrs {
+		content += fmt.Sprintf(`%s{"nodehost_id": "%s", "raft_address": "%s"}`,
+			sep, nhid, addr)
+		sep = ","
+	}
+	content += "]}"
+	f, err := fs.Create(fn)
+	if err != nil {
+		t.Fatalf("failed to create file %v", err)
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatalf("failed to write file %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close file %v", err)
+	}
+}
+
+func TestStaticRegistryCanHandleDynamicRaftAddress(t *testing.T) {
+	fs := vfs.GetTestFS()
+	datadir1 := fs.PathJoin(singleNodeHostTestDir, "nh1")
+	datadir2 := fs.PathJoin(singleNodeHostTestDir, "nh2")
+	fn := fs.PathJoin(singleNodeHostTestDir, "registry.json")
+	_ = fs.RemoveAll(singleNodeHostTestDir)
 	defer func() {
-		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
-			t.Fatalf("%v", err)
-		}
+		_ = fs.RemoveAll(singleNodeHostTestDir)
 	}()
-	func() {
-		defer leaktest.AfterTest(t)()
-		nh1dir := fs.PathJoin(singleNodeHostTestDir, "nh1")
-		nh2dir := fs.PathJoin(singleNodeHostTestDir, "nh2")
-		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
-			t.Fatalf("%v", err)
-		}
-		nh1, nh2, err := createFakeDiskTwoTestNodeHosts(nodeHostTestAddr1,
-			nodeHostTestAddr2, nh1dir, nh2dir, fs)
-		if err != nil {
-			t.Fatalf("failed to create nodehost %v", err)
+	if err := fs.MkdirAll(singleNodeHostTestDir, 0755); err != nil {
+		t.Fatalf("failed to create dir %v", err)
+	}
+	writeStaticRegistryFile(t, fs, fn, map[string]string{
+		testNodeHostID1: nodeHostTestAddr1,
+		testNodeHostID2: nodeHostTestAddr2,
+	})
+	getConfig := func(dir string, nhid string, addr string) config.NodeHostConfig {
+		return config.NodeHostConfig{
+			NodeHostDir:                dir,
+			RTTMillisecond:             getRTTMillisecond(fs, dir),
+			RaftAddress:                addr,
+			NodeHostID:                 nhid,
+			DefaultNodeRegistryEnabled: true,
+			StaticRegistry:             config.StaticRegistryConfig{File: fn},
+			Expert:                     config.ExpertConfig{FS: fs},
 		}
-		defer func() {
-			nh1.Close()
-			nh2.Close()
-		}()
-		tf(t, nh1, nh2)
-	}()
-	reportLeakedFD(fs, t)
-}
-
-func createFakeDiskTwoTestNodeHosts(addr1 string, addr2 string,
-	datadir1 string, datadir2 string, fs vfs.IFS) (*NodeHost, *NodeHost, error) {
-	peers := make(map[uint64]string)
-	peers[1] = addr1
-	nhc1 := config.NodeHostConfig{
-		WALDir:              datadir1,
-		NodeHostDir:         datadir1,
-		RTTMillisecond:      getRTTMillisecond(fs, datadir1),
-		RaftAddress:         addr1,
-		SystemEventListener: &testSysEventListener{},
-		Expert:              getTestExpertConfig(fs),
-	}
-	nhc2 := config.NodeHostConfig{
-		WALDir:              datadir2,
-		NodeHostDir:         datadir2,
-		RTTMillisecond:      getRTTMillisecond(fs, datadir2),
-		RaftAddress:         addr2,
-		SystemEventListener: &testSysEventListener{},
-		Expert:              getTestExpertConfig(fs),
 	}
+	nhc1 := getConfig(datadir1, testNodeHostID1, nodeHostTestAddr1)
+	nhc2 := getConfig(datadir2, testNodeHostID2, nodeHostTestAddr2)
 	nh1, err := NewNodeHost(nhc1)
 	if err != nil {
-		return nil, nil, err
+		t.Fatalf("failed to create nh, %v", err)
 	}
+	defer nh1.Close()
 	nh2, err := NewNodeHost(nhc2)
 	if err != nil {
-		return nil, nil, err
-	}
-	return nh1, nh2, nil
-}
-
-func createRateLimitedTwoTestNodeHosts(addr1 string, addr2 string,
-	datadir1 string, datadir2 string,
-	fs vfs.IFS) (*NodeHost, *NodeHost, *tests.NoOP, *tests.NoOP, error) {
-	rc := config.Config{
-		ShardID:         1,
-		ElectionRTT:     3,
-		HeartbeatRTT:    1,
-		CheckQuorum:     true,
-		MaxInMemLogSize: 1024 * 3,
+		t.Fatalf("failed to create nh2, %v", err)
 	}
 	peers := make(map[uint64]string)
-	peers[1] = addr1
-	peers[2] = addr2
-	nhc1 := config.NodeHostConfig{
-		WALDir:         datadir1,
-		NodeHostDir:    datadir1,
-		RTTMillisecond: getRTTMillisecond(fs, datadir1),
-		RaftAddress:    peers[1],
-		Expert:         getTestExpertConfig(fs),
+	peers[1] = testNodeHostID1
+	peers[2] = testNodeHostID2
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &PST{}
 	}
-	nhc2 := config.NodeHostConfig{
-		WALDir:         datadir2,
-		NodeHostDir:    datadir2,
-		RTTMillisecond: getRTTMillisecond(fs, datadir2),
-		RaftAddress:    peers[2],
-		Expert:         getTestExpertConfig(fs),
+	rc := config.Config{
+		ShardID:      1,
+		ReplicaID:    1,
+		ElectionRTT:  3,
+		HeartbeatRTT: 1,
 	}
-	nh1, err := NewNodeHost(nhc1)
-	if err != nil {
-		return nil, nil, nil, nil, err
+	if err := nh1.StartReplica(peers, false, createSM, rc); err != nil {
+		t.Fatalf("failed to start node %v", err)
 	}
-	nh2, err := NewNodeHost(nhc2)
-	if err != nil {
-		return nil, nil, nil, nil, err
+	rc.ReplicaID = 2
+	if err := nh2.StartReplica(peers, false, createSM, rc); err != nil {
+		t.Fatalf("failed to start node %v", err)
 	}
-	sm1 := &tests.NoOP{}
-	sm2 := &tests.NoOP{}
-	newRSM1 := func(shardID uint64, replicaID uint64) sm.IStateMachine {
-		return sm1
+	waitForLeaderToBeElected(t, nh1, 1)
+	waitForLeaderToBeElected(t, nh2, 1)
+	pto := lpto(nh1)
+	session := nh1.GetNoOPSession(1)
+	testProposal := func() {
+		for i := 0; i < 100; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			_, err := nh1.SyncPropose(ctx, session, make([]byte, 0))
+			cancel()
+			if err == nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("failed to make proposal")
 	}
-	newRSM2 := func(shardID uint64, replicaID uint64) sm.IStateMachine {
-		return sm2
+	testProposal()
+	// move nh2 to a different RaftAddress, nh1 learns the new address by
+	// reloading the registry file
+	nh2.Close()
+	writeStaticRegistryFile(t, fs, fn, map[string]string{
+		testNodeHostID1: nodeHostTestAddr1,
+		testNodeHostID2: nodeHostTestAddr3,
+	})
+	if err := nh1.ReloadRegistry(); err != nil {
+		t.Fatalf("failed to reload registry %v", err)
 	}
-	rc.ReplicaID = 1
-	if err := nh1.StartReplica(peers, false, newRSM1, rc); err != nil {
-		return nil, nil, nil, nil, err
+	nhc2.RaftAddress = nodeHostTestAddr3
+	nh2, err = NewNodeHost(nhc2)
+	if err != nil {
+		t.Fatalf("failed to restart nh2, %v", err)
 	}
-	rc.ReplicaID = 2
-	if err := nh2.StartReplica(peers, false, newRSM2, rc); err != nil {
-		return nil, nil, nil, nil, err
+	defer nh2.Close()
+	if err := nh2.StartReplica(peers, false, createSM, rc); err != nil {
+		t.Fatalf("failed to start node %v", err)
 	}
-	var leaderNh *NodeHost
-	var followerNh *NodeHost
+	waitForLeaderToBeElected(t, nh2, 1)
+	testProposal()
+	for _, ps := range nh1.GetTransportStats() {
+		if ps.Address == nodeHostTestAddr3 && ps.MessagesSent > 0 {
+			return
+		}
+	}
+	t.Errorf("no message sent to the new address")
+}
 
-	for i := 0; i < 200; i++ {
-		leaderID, _, ready, err := nh1.GetLeaderID(1)
-		if err == nil && ready {
-			if leaderID == 1 {
-				leaderNh = nh1
-				followerNh = nh2
-				sm2.SetSleepTime(nhc1.RTTMillisecond * 10)
-			} else {
-				leaderNh = nh2
-				followerNh = nh1
-				sm1.SetSleepTime(nhc1.RTTMillisecond * 10)
+func TestRegistryOperationsRequireMatchingRegistry(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		tf: func(nh *NodeHost) {
+			if err := nh.ReloadRegistry(); !errors.Is(err, ErrInvalidOperation) {
+				t.Errorf("unexpected error %v", err)
 			}
-			return leaderNh, followerNh, sm1, sm2, nil
-		}
-		// wait for leader to be elected
-		time.Sleep(100 * time.Millisecond)
+			tags := map[string]string{"zone": "a"}
+			if err := nh.UpdateGossipTags(tags); !errors.Is(err, ErrInvalidOperation) {
+				t.Errorf("unexpected error %v", err)
+			}
+			key := make([]byte, 16)
+			if err := nh.AddGossipKey(key); !errors.Is(err, ErrInvalidOperation) {
+				t.Errorf("unexpected error %v", err)
+			}
+			if err := nh.SetDrainState(true); !errors.Is(err, ErrInvalidOperation) {
+				t.Errorf("unexpected error %v", err)
+			}
+		},
+		noElection: true,
 	}
-	return nil, nil, nil, nil, errors.New("failed to get usable nodehosts")
+	runNodeHostTest(t, to, fs)
 }
 
-func rateLimitedTwoNodeHostTest(t *testing.T,
-	tf func(t *testing.T, leaderNh *NodeHost, followerNh *NodeHost,
-		n1 *tests.NoOP, n2 *tests.NoOP), fs vfs.IFS) {
+func TestExternalRegistryCanBeUsedForDiscovery(t *testing.T) {
+	fs := vfs.GetTestFS()
+	_ = fs.RemoveAll(singleNodeHostTestDir)
 	defer func() {
-		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
-			t.Fatalf("%v", err)
-		}
+		_ = fs.RemoveAll(singleNodeHostTestDir)
 	}()
-	func() {
-		nh1dir := fs.PathJoin(singleNodeHostTestDir, "nh1")
-		nh2dir := fs.PathJoin(singleNodeHostTestDir, "nh2")
-		defer leaktest.AfterTest(t)()
-		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
-			t.Fatalf("%v", err)
+	network := memtransport.NewNetwork()
+	kv := kvregistry.NewMemKV()
+	nhids := []string{testNodeHostID1, testNodeHostID2}
+	rtt := getRTTMillisecond(fs, singleNodeHostTestDir)
+	configs := network.NodeHostConfigs(len(nhids), singleNodeHostTestDir, rtt)
+	nhs := make([]*NodeHost, 0, len(nhids))
+	defer func() {
+		for _, nh := range nhs {
+			nh.Close()
 		}
-		nh1, nh2, n1, n2, err := createRateLimitedTwoTestNodeHosts(nodeHostTestAddr1,
-			nodeHostTestAddr2, nh1dir, nh2dir, fs)
+	}()
+	peers := make(map[uint64]string)
+	for i, nhc := range configs {
+		nhc.NodeHostID = nhids[i]
+		nhc.DefaultNodeRegistryEnabled = true
+		nhc.Expert = getTestExpertConfig(fs)
+		nhc.Expert.TransportFactory = network
+		nhc.Expert.RegistryFactory = kvregistry.NewFactory(kv,
+			kvregistry.Config{Meta: []byte(nhids[i])})
+		nhc.Expert.RegistryPublishInterval = 10 * time.Millisecond
+		nh, err := NewNodeHost(nhc)
 		if err != nil {
-			t.Fatalf("failed to create nodehost2 %v", err)
+			t.Fatalf("failed to create nh, %v", err)
 		}
-		defer func() {
-			nh1.Close()
-			nh2.Close()
-		}()
-		tf(t, nh1, nh2, n1, n2)
-	}()
-	reportLeakedFD(fs, t)
-}
-
-func waitForLeaderToBeElected(t *testing.T, nh *NodeHost, shardID uint64) {
-	for i := 0; i < 200; i++ {
-		_, term, ready, err := nh.GetLeaderID(shardID)
-		if err == nil && ready {
-			if term == 0 {
-				panic("term is 0")
+		nhs = append(nhs, nh)
+		peers[uint64(i+1)] = nhids[i]
+	}
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &PST{}
+	}
+	for i, nh := range nhs {
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    uint64(i + 1),
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+		}
+		if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+			t.Fatalf("failed to start node %v", err)
+		}
+	}
+	for _, nh := range nhs {
+		waitForLeaderToBeElected(t, nh, 1)
+	}
+	if !makeTestProposal(nhs[0], 100) {
+		t.Fatalf("failed to make proposal")
+	}
+	for i := 0; i < 1000; i++ {
+		r, ok := nhs[0].GetNodeHostRegistry()
+		if !ok {
+			t.Fatalf("registry not available")
+		}
+		sv, ok := r.GetShardInfo(1)
+		if ok && len(sv.Replicas) == 2 && sv.LeaderID != 0 {
+			v, ok := r.GetMeta(testNodeHostID2)
+			if !ok || string(v) != testNodeHostID2 {
+				t.Errorf("unexpected meta %s", v)
 			}
 			return
 		}
-		time.Sleep(100 * time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
 	}
-	t.Fatalf("failed to elect leader")
+	t.Fatalf("shard view not published")
 }
 
-func TestJoinedShardCanBeRestartedOrJoinedAgain(t *testing.T) {
+func TestNewNodeHostReturnErrorOnInvalidConfig(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			cfg := getTestConfig()
-			peers := make(map[uint64]string)
-			newPST := func(uint64, uint64) sm.IStateMachine { return &PST{} }
-			if err := nh.StopShard(1); err != nil {
-				t.Fatalf("failed to stop the shard: %v", err)
-			}
-			for i := 0; i < 1000; i++ {
-				err := nh.StartReplica(peers, true, newPST, *cfg)
-				if err == nil {
-					return
-				}
-				if err == ErrShardAlreadyExist {
-					time.Sleep(5 * time.Millisecond)
-					continue
-				} else {
-					t.Fatalf("failed to join the shard again, %v", err)
-				}
+		updateNodeHostConfig: func(nhc *config.NodeHostConfig) *config.NodeHostConfig {
+			nhc.RaftAddress = "12345"
+			if err := nhc.Validate(); err == nil {
+				t.Fatalf("config is not considered as invalid")
 			}
+			return nhc
 		},
-		join:       true,
-		noElection: true,
+		newNodeHostToFail: true,
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestCompactionCanBeRequested(t *testing.T) {
+func TestDeploymentIDCanBeSetUsingNodeHostConfig(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
-		defaultTestNode: true,
-		updateConfig: func(c *config.Config) *config.Config {
-			c.SnapshotEntries = 10
-			c.CompactionOverhead = 5
-			c.DisableAutoCompactions = true
-			return c
+		updateNodeHostConfig: func(nhc *config.NodeHostConfig) *config.NodeHostConfig {
+			nhc.DeploymentID = 1000
+			return nhc
 		},
 		tf: func(nh *NodeHost) {
-			pto := lpto(nh)
-			session := nh.GetNoOPSession(1)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			defer cancel()
-			_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
-			if err != nil {
-				t.Fatalf("failed to make proposal, %v", err)
-			}
-			opt := SnapshotOption{
-				OverrideCompactionOverhead: true,
-				CompactionOverhead:         0,
-			}
-			if _, err := nh.SyncRequestSnapshot(ctx, 1, opt); err != nil {
-				t.Fatalf("failed to request snapshot %v", err)
-			}
-			for i := 0; i < 100; i++ {
-				op, err := nh.RequestCompaction(1, 1)
-				if err == ErrRejected {
-					time.Sleep(100 * time.Millisecond)
-					continue
-				}
-				if err != nil {
-					t.Fatalf("failed to request compaction %v", err)
-				}
-				select {
-				case <-op.ResultC():
-					break
-				case <-ctx.Done():
-					t.Fatalf("failed to complete the compaction")
-				}
-				break
-			}
-			if _, err = nh.RequestCompaction(1, 1); err != ErrRejected {
-				t.Fatalf("not rejected")
+			nhc := nh.NodeHostConfig()
+			if did := nhc.GetDeploymentID(); did != 1000 {
+				t.Errorf("unexpected did: %d", did)
 			}
 		},
+		noElection: true,
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestSnapshotCanBeStopped(t *testing.T) {
-	fs := vfs.GetTestFS()
-	pst := &PST{slowSave: true}
-	to := &testOption{
-		updateConfig: func(c *config.Config) *config.Config {
-			c.SnapshotEntries = 10
-			return c
-		},
-		createSM: func(shardID uint64, replicaID uint64) sm.IStateMachine {
-			return pst
-		},
-		tf: func(nh *NodeHost) {
-			createProposalsToTriggerSnapshot(t, nh, 50, true)
-		},
-		at: func(*NodeHost) {
-			if !pst.saved || !pst.stopped {
-				t.Errorf("snapshot not stopped")
-			}
-		},
-	}
-	runNodeHostTest(t, to, fs)
-}
+var (
+	singleNodeHostTestAddr = fmt.Sprintf("localhost:%d", getTestPort())
+	nodeHostTestAddr1      = fmt.Sprintf("localhost:%d", getTestPort())
+	nodeHostTestAddr2      = fmt.Sprintf("localhost:%d", getTestPort()+1)
+	nodeHostTestAddr3      = fmt.Sprintf("localhost:%d", getTestPort()+2)
+	singleNodeHostTestDir  = "single_nodehost_test_dir_safe_to_delete"
+)
 
-func TestRecoverFromSnapshotCanBeStopped(t *testing.T) {
-	fs := vfs.GetTestFS()
-	pst := &PST{slowSave: false}
-	to := &testOption{
-		updateConfig: func(c *config.Config) *config.Config {
-			c.SnapshotEntries = 10
-			return c
-		},
-		createSM: func(shardID uint64, replicaID uint64) sm.IStateMachine {
-			return pst
-		},
-		tf: func(nh *NodeHost) {
-			createProposalsToTriggerSnapshot(t, nh, 50, false)
-		},
-		rf: func(nh *NodeHost) {
-			wait := 0
-			for !pst.getRestored() {
-				time.Sleep(10 * time.Millisecond)
-				wait++
-				if wait > 1000 {
-					break
-				}
-			}
-		},
-		at: func(*NodeHost) {
-			wait := 0
-			for !pst.stopped {
-				time.Sleep(10 * time.Millisecond)
-				wait++
-				if wait > 1000 {
-					break
-				}
-			}
-			if !pst.getRestored() {
-				t.Errorf("not restored")
-			}
-			if !pst.stopped {
-				t.Errorf("not stopped")
-			}
-		},
-		restartNodeHost: true,
-	}
-	runNodeHostTest(t, to, fs)
+type PST struct {
+	mu       sync.Mutex
+	stopped  bool
+	saved    bool
+	restored bool
+	slowSave bool
 }
 
-func TestGetRequestState(t *testing.T) {
-	tests := []struct {
-		code RequestResultCode
-		err  error
-	}{
-		{requestCompleted, nil},
-		{requestRejected, ErrRejected},
-		{requestTimeout, ErrTimeout},
-		{requestTerminated, ErrShardClosed},
-		{requestDropped, ErrShardNotReady},
-		{requestAborted, ErrAborted},
-	}
+func (n *PST) setRestored(v bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.restored = v
+}
 
-	for _, tt := range tests {
-		rs := &RequestState{
-			CompletedC: make(chan RequestResult, 1),
-		}
-		result := RequestResult{code: tt.code}
-		rs.notify(result)
-		if _, err := getRequestState(context.TODO(), rs); !errors.Is(err, tt.err) {
-			t.Errorf("expect error %v, got %v", tt.err, err)
-		}
-	}
+func (n *PST) getRestored() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.restored
 }
 
-func TestGetRequestStateTimeoutAndCancel(t *testing.T) {
-	func() {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
-		defer cancel()
-		time.Sleep(2 * time.Millisecond)
-		rs := &RequestState{
-			CompletedC: make(chan RequestResult, 1),
-		}
-		if _, err := getRequestState(ctx, rs); !errors.Is(err, ErrTimeout) {
-			t.Errorf("got %v", err)
-		}
-	}()
+func (n *PST) Close() error { return nil }
 
-	func() {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
-		cancel()
-		rs := &RequestState{
-			CompletedC: make(chan RequestResult, 1),
-		}
-		if _, err := getRequestState(ctx, rs); !errors.Is(err, ErrCanceled) {
-			t.Errorf("got %v", err)
-		}
-	}()
+// Lookup locally looks up the data.
+func (n *PST) Lookup(key interface{}) (interface{}, error) {
+	return make([]byte, 1), nil
 }
 
-func TestNodeHostIDIsStatic(t *testing.T) {
-	fs := vfs.GetTestFS()
-	id := ""
-	to := &testOption{
-		restartNodeHost: true,
-		noElection:      true,
-		tf: func(nh *NodeHost) {
-			id = nh.ID()
-		},
-		rf: func(nh *NodeHost) {
-			if nh.ID() != id {
-				t.Fatalf("NodeHost ID value changed")
-			}
-		},
-	}
-	runNodeHostTest(t, to, fs)
+// Update updates the object.
+func (n *PST) Update(e sm.Entry) (sm.Result, error) {
+	return sm.Result{Value: uint64(len(e.Cmd))}, nil
 }
 
-func TestNodeHostIDCanBeSet(t *testing.T) {
-	fs := vfs.GetTestFS()
-	nhid := testNodeHostID1
-	to := &testOption{
-		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
-			c.NodeHostID = nhid
-			return c
-		},
-		noElection: true,
-		tf: func(nh *NodeHost) {
-			nhid, err := id.NewUUID(nhid)
-			if err != nil {
-				t.Fatalf("failed to create NodeHostID")
-			}
-			if nh.ID() != nhid.String() {
-				t.Fatalf("failed to set nhid")
-			}
-		},
+// SaveSnapshot saves the state of the object to the provided io.Writer object.
+func (n *PST) SaveSnapshot(w io.Writer,
+	fileCollection sm.ISnapshotFileCollection,
+	done <-chan struct{}) error {
+	n.saved = true
+	if !n.slowSave {
+		_, err := w.Write([]byte("random-data"))
+		if err != nil {
+			panic(err)
+		}
+		return nil
 	}
-	runNodeHostTest(t, to, fs)
-}
-
-func TestInvalidAddressIsRejected(t *testing.T) {
-	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			pto := pto(nh)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			defer cancel()
-			err := nh.SyncRequestAddReplica(ctx, 1, 100, "a1", 0)
-			if err != ErrInvalidAddress {
-				t.Errorf("failed to return ErrInvalidAddress, %v", err)
-			}
-		},
+	for {
+		time.Sleep(10 * time.Millisecond)
+		select {
+		case <-done:
+			n.stopped = true
+			return sm.ErrSnapshotStopped
+		default:
+		}
 	}
-	runNodeHostTest(t, to, fs)
 }
 
-func TestInvalidContextDeadlineIsReported(t *testing.T) {
-	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			pto := lpto(nh)
-			rctx, rcancel := context.WithTimeout(context.Background(), pto)
-			rcs, err := nh.SyncGetSession(rctx, 1)
-			rcancel()
-			if err != nil {
-				t.Fatalf("failed to get regular session")
-			}
-			// 8 * time.Millisecond is smaller than the smallest possible RTTMillisecond
-			ctx, cancel := context.WithTimeout(context.Background(), 8*time.Millisecond)
-			defer cancel()
-			cs := nh.GetNoOPSession(1)
-			_, err = nh.SyncPropose(ctx, cs, make([]byte, 1))
-			if err != ErrTimeoutTooSmall {
-				t.Errorf("failed to return ErrTimeoutTooSmall, %v", err)
-			}
-			_, err = nh.SyncRead(ctx, 1, nil)
-			if err != ErrTimeoutTooSmall {
-				t.Errorf("failed to return ErrTimeoutTooSmall, %v", err)
-			}
-			_, err = nh.SyncGetSession(ctx, 1)
-			if err != ErrTimeoutTooSmall {
-				t.Errorf("failed to return ErrTimeoutTooSmall, %v", err)
-			}
-			err = nh.SyncCloseSession(ctx, rcs)
-			if err != ErrTimeoutTooSmall {
-				t.Errorf("failed to return ErrTimeoutTooSmall, %v", err)
-			}
-			_, err = nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption)
-			if err != ErrTimeoutTooSmall {
-				t.Errorf("failed to return ErrTimeoutTooSmall, %v", err)
-			}
-			err = nh.SyncRequestDeleteReplica(ctx, 1, 1, 0)
-			if err != ErrTimeoutTooSmall {
-				t.Errorf("failed to return ErrTimeoutTooSmall, %v", err)
-			}
-			err = nh.SyncRequestAddReplica(ctx, 1, 100, "a1.com:12345", 0)
-			if err != ErrTimeoutTooSmall {
-				t.Errorf("failed to return ErrTimeoutTooSmall, %v", err)
-			}
-			err = nh.SyncRequestAddNonVoting(ctx, 1, 100, "a1.com:12345", 0)
-			if err != ErrTimeoutTooSmall {
-				t.Errorf("failed to return ErrTimeoutTooSmall, %v", err)
-			}
-		},
+// RecoverFromSnapshot recovers the object from the snapshot specified by the
+// io.Reader object.
+func (n *PST) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	n.setRestored(true)
+	for {
+		time.Sleep(10 * time.Millisecond)
+		select {
+		case <-done:
+			n.stopped = true
+			return sm.ErrSnapshotStopped
+		default:
+		}
 	}
-	runNodeHostTest(t, to, fs)
 }
 
-func TestErrShardNotFoundCanBeReturned(t *testing.T) {
-	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			pto := lpto(nh)
-			_, _, _, err := nh.GetLeaderID(1234)
-			if err != ErrShardNotFound {
-				t.Errorf("failed to return ErrShardNotFound, %v", err)
-			}
-			_, err = nh.StaleRead(1234, nil)
-			if err != ErrShardNotFound {
-				t.Errorf("failed to return ErrShardNotFound, %v", err)
-			}
-			_, err = nh.RequestSnapshot(1234, DefaultSnapshotOption, pto)
-			if err != ErrShardNotFound {
-				t.Errorf("failed to return ErrShardNotFound, %v", err)
-			}
-			_, err = nh.RequestDeleteReplica(1234, 10, 0, pto)
-			if err != ErrShardNotFound {
-				t.Errorf("failed to return ErrShardNotFound, %v", err)
-			}
-			_, err = nh.RequestAddReplica(1234, 10, "a1", 0, pto)
-			if err != ErrShardNotFound {
-				t.Errorf("failed to return ErrShardNotFound, %v", err)
-			}
-			_, err = nh.RequestAddNonVoting(1234, 10, "a1", 0, pto)
-			if err != ErrShardNotFound {
-				t.Errorf("failed to return ErrShardNotFound, %v", err)
-			}
-			err = nh.RequestLeaderTransfer(1234, 10)
-			if err != ErrShardNotFound {
-				t.Errorf("failed to return ErrShardNotFound, %v", err)
-			}
-			_, err = nh.GetNodeUser(1234)
-			if err != ErrShardNotFound {
-				t.Errorf("failed to return ErrShardNotFound, %v", err)
-			}
-			cs := nh.GetNoOPSession(1234)
-			_, err = nh.propose(cs, make([]byte, 1), pto)
-			if err != ErrShardNotFound {
-				t.Errorf("failed to return ErrShardNotFound, %v", err)
-			}
-			_, _, err = nh.readIndex(1234, pto)
-			if err != ErrShardNotFound {
-				t.Errorf("failed to return ErrShardNotFound, %v", err)
-			}
-			err = nh.stopNode(1234, 1, true)
-			if err != ErrShardNotFound {
-				t.Errorf("failed to return ErrShardNotFound, %v", err)
-			}
-		},
-	}
-	runNodeHostTest(t, to, fs)
+// GetHash returns a uint64 value representing the current state of the object.
+func (n *PST) GetHash() (uint64, error) {
+	return 0, nil
 }
 
-func TestGetShardMembership(t *testing.T) {
-	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			pto := pto(nh)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			defer cancel()
-			_, err := nh.SyncGetShardMembership(ctx, 1)
-			if err != nil {
-				t.Fatalf("failed to get shard membership")
-			}
-		},
+func createConcurrentTestNodeHost(addr string,
+	datadir string, snapshotEntry uint64,
+	concurrent bool, fs vfs.IFS) (*NodeHost, error) {
+	// config for raft
+	rc := config.Config{
+		ReplicaID:          uint64(1),
+		ElectionRTT:        3,
+		HeartbeatRTT:       1,
+		CheckQuorum:        true,
+		SnapshotEntries:    snapshotEntry,
+		CompactionOverhead: 100,
 	}
-	runNodeHostTest(t, to, fs)
-}
-
-func TestRegisterASessionTwiceWillBeReported(t *testing.T) {
-	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			pto := lpto(nh)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			defer cancel()
-			cs, err := nh.SyncGetSession(ctx, 1)
-			if err != nil {
-				t.Errorf("failed to get client session %v", err)
-			}
-			cs.PrepareForRegister()
-			rs, err := nh.ProposeSession(cs, pto)
-			if err != nil {
-				t.Errorf("failed to propose client session %v", err)
-			}
-			r := <-rs.ResultC()
-			if !r.Rejected() {
-				t.Errorf("failed to reject the cs registeration")
-			}
-		},
+	peers := make(map[uint64]string)
+	peers[1] = addr
+	nhc := config.NodeHostConfig{
+		WALDir:         datadir,
+		NodeHostDir:    datadir,
+		RTTMillisecond: getRTTMillisecond(fs, datadir),
+		RaftAddress:    peers[1],
+		Expert:         getTestExpertConfig(fs),
 	}
-	runNodeHostTest(t, to, fs)
+	nh, err := NewNodeHost(nhc)
+	if err != nil {
+		return nil, err
+	}
+	var newConcurrentSM func(uint64, uint64) sm.IConcurrentStateMachine
+	var newSM func(uint64, uint64) sm.IStateMachine
+	if snapshotEntry == 0 {
+		newConcurrentSM = func(uint64, uint64) sm.IConcurrentStateMachine {
+			return &tests.ConcurrentUpdate{}
+		}
+		newSM = func(uint64, uint64) sm.IStateMachine {
+			return &tests.TestUpdate{}
+		}
+	} else {
+		newConcurrentSM = func(uint64, uint64) sm.IConcurrentStateMachine {
+			return &tests.ConcurrentSnapshot{}
+		}
+		newSM = func(uint64, uint64) sm.IStateMachine {
+			return &tests.TestSnapshot{}
+		}
+	}
+	rc.ShardID = 1 + nhc.Expert.Engine.ApplyShards
+	if err := nh.StartConcurrentReplica(peers, false, newConcurrentSM, rc); err != nil {
+		return nil, err
+	}
+	rc.ShardID = 1
+	if err := nh.StartReplica(peers, false, newSM, rc); err != nil {
+		return nil, err
+	}
+	return nh, nil
 }
 
-func TestUnregisterNotRegisterClientSessionWillBeReported(t *testing.T) {
-	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			pto := lpto(nh)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			defer cancel()
-			cs, err := nh.SyncGetSession(ctx, 1)
-			if err != nil {
-				t.Errorf("failed to get client session %v", err)
-			}
-			err = nh.SyncCloseSession(ctx, cs)
-			if err != nil {
-				t.Errorf("failed to unregister the client session %v", err)
+func singleConcurrentNodeHostTest(t *testing.T,
+	tf func(t *testing.T, nh *NodeHost),
+	snapshotEntry uint64, concurrent bool, fs vfs.IFS) {
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	func() {
+		defer leaktest.AfterTest(t)()
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+		nh, err := createConcurrentTestNodeHost(singleNodeHostTestAddr,
+			singleNodeHostTestDir, snapshotEntry, concurrent, fs)
+		if err != nil {
+			t.Fatalf("failed to create nodehost %v", err)
+		}
+		defer func() {
+			nh.Close()
+		}()
+		nhc := nh.NodeHostConfig()
+		waitForLeaderToBeElected(t, nh, 1)
+		waitForLeaderToBeElected(t, nh, 1+nhc.Expert.Engine.ApplyShards)
+		tf(t, nh)
+	}()
+	reportLeakedFD(fs, t)
+}
+
+func twoFakeDiskNodeHostTest(t *testing.T,
+	tf func(t *testing.T, nh1 *NodeHost, nh2 *NodeHost), fs vfs.IFS) {
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	func() {
+		defer leaktest.AfterTest(t)()
+		nh1dir := fs.PathJoin(singleNodeHostTestDir, "nh1")
+		nh2dir := fs.PathJoin(singleNodeHostTestDir, "nh2")
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+		nh1, nh2, err := createFakeDiskTwoTestNodeHosts(nodeHostTestAddr1,
+			nodeHostTestAddr2, nh1dir, nh2dir, fs)
+		if err != nil {
+			t.Fatalf("failed to create nodehost %v", err)
+		}
+		defer func() {
+			nh1.Close()
+			nh2.Close()
+		}()
+		tf(t, nh1, nh2)
+	}()
+	reportLeakedFD(fs, t)
+}
+
+func createFakeDiskTwoTestNodeHosts(addr1 string, addr2 string,
+	datadir1 string, datadir2 string, fs vfs.IFS) (*NodeHost, *NodeHost, error) {
+	peers := make(map[uint64]string)
+	peers[1] = addr1
+	network := memtransport.NewNetwork()
+	nhc1 := config.NodeHostConfig{
+		WALDir:              datadir1,
+		NodeHostDir:         datadir1,
+		RTTMillisecond:      getRTTMillisecond(fs, datadir1),
+		RaftAddress:         addr1,
+		SystemEventListener: &testSysEventListener{},
+		Expert:              getTestExpertConfig(fs),
+	}
+	nhc1.Expert.TransportFactory = network
+	nhc2 := config.NodeHostConfig{
+		WALDir:              datadir2,
+		NodeHostDir:         datadir2,
+		RTTMillisecond:      getRTTMillisecond(fs, datadir2),
+		RaftAddress:         addr2,
+		SystemEventListener: &testSysEventListener{},
+		Expert:              getTestExpertConfig(fs),
+	}
+	nhc2.Expert.TransportFactory = network
+	nh1, err := NewNodeHost(nhc1)
+	if err != nil {
+		return nil, nil, err
+	}
+	nh2, err := NewNodeHost(nhc2)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nh1, nh2, nil
+}
+
+// createMemTransportNodeHosts creates NodeHosts connected by the specified
+// network, the optional update function is invoked on the config of each
+// NodeHost in order before it is created.
+func createMemTransportNodeHosts(network *memtransport.Network,
+	count int, update updateNodeHostConfig, fs vfs.IFS) ([]*NodeHost, error) {
+	rtt := getRTTMillisecond(fs, singleNodeHostTestDir)
+	configs := network.NodeHostConfigs(count, singleNodeHostTestDir, rtt)
+	nhs := make([]*NodeHost, 0, count)
+	for _, nhc := range configs {
+		nhc.Expert = getTestExpertConfig(fs)
+		nhc.Expert.TransportFactory = network
+		if update != nil {
+			nhc = *update(&nhc)
+		}
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			for _, v := range nhs {
+				v.Close()
 			}
-			err = nh.SyncCloseSession(ctx, cs)
-			if err != ErrRejected {
-				t.Errorf("failed to reject the request %v", err)
+			return nil, err
+		}
+		nhs = append(nhs, nh)
+	}
+	return nhs, nil
+}
+
+func memTransportNodeHostTest(t *testing.T, count int,
+	tf func(t *testing.T, network *memtransport.Network, nhs []*NodeHost),
+	fs vfs.IFS) {
+	updatedMemTransportNodeHostTest(t, count, nil, tf, fs)
+}
+
+// updatedMemTransportNodeHostTest is similar to memTransportNodeHostTest, the
+// config of each NodeHost is updated by the specified function.
+func updatedMemTransportNodeHostTest(t *testing.T, count int,
+	update updateNodeHostConfig,
+	tf func(t *testing.T, network *memtransport.Network, nhs []*NodeHost),
+	fs vfs.IFS) {
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	func() {
+		defer leaktest.AfterTest(t)()
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+		network := memtransport.NewNetwork()
+		nhs, err := createMemTransportNodeHosts(network, count, update, fs)
+		if err != nil {
+			t.Fatalf("failed to create nodehosts %v", err)
+		}
+		defer func() {
+			for _, nh := range nhs {
+				nh.Close()
 			}
-		},
+		}()
+		tf(t, network, nhs)
+	}()
+	reportLeakedFD(fs, t)
+}
+
+func startMemTransportShard(t *testing.T, nhs []*NodeHost, shardID uint64) {
+	peers := make(map[uint64]string)
+	for i := range nhs {
+		peers[uint64(i+1)] = memtransport.Address(i + 1)
+	}
+	for i, nh := range nhs {
+		rc := config.Config{
+			ShardID:      shardID,
+			ReplicaID:    uint64(i + 1),
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
+		}
+		createSM := func(uint64, uint64) sm.IStateMachine {
+			return &PST{}
+		}
+		if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+	}
+	for _, nh := range nhs {
+		waitForLeaderToBeElected(t, nh, shardID)
 	}
-	runNodeHostTest(t, to, fs)
 }
 
-func TestSnapshotFilePayloadChecksumIsSaved(t *testing.T) {
+func TestMemTransportNodeHostsCanSurvivePartition(t *testing.T) {
 	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		updateConfig: func(c *config.Config) *config.Config {
-			c.SnapshotEntries = 10
-			return c
-		},
-		tf: func(nh *NodeHost) {
-			cs := nh.GetNoOPSession(1)
-			logdb := nh.mu.logdb
-			snapshotted := false
-			var snapshot pb.Snapshot
-			for i := 0; i < 1000; i++ {
-				pto := pto(nh)
-				ctx, cancel := context.WithTimeout(context.Background(), pto)
-				_, err := nh.SyncPropose(ctx, cs, []byte("test-data"))
-				cancel()
-				if err != nil {
-					continue
-				}
-				ss, err := logdb.GetSnapshot(1, 1)
-				if err != nil {
-					t.Fatalf("failed to list snapshots")
-				}
-				if !pb.IsEmptySnapshot(ss) {
-					snapshotted = true
-					snapshot = ss
-					break
-				}
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		startMemTransportShard(t, nhs, 1)
+		if !makeTestProposal(nhs[0], 100) {
+			t.Fatalf("failed to make proposal")
+		}
+		leaderID, _, _, err := nhs[0].GetLeaderID(1)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		var others []string
+		for i := range nhs {
+			if uint64(i+1) != leaderID {
+				others = append(others, memtransport.Address(i+1))
 			}
-			if !snapshotted {
-				t.Fatalf("snapshot not triggered")
+		}
+		network.Partition([]string{memtransport.Address(int(leaderID))}, others)
+		follower := nhs[0]
+		if leaderID == 1 {
+			follower = nhs[1]
+		}
+		for i := 0; i < 200; i++ {
+			newLeaderID, _, ok, err := follower.GetLeaderID(1)
+			if err == nil && ok && newLeaderID != leaderID {
+				break
 			}
-			crc, err := rsm.GetV2PayloadChecksum(snapshot.Filepath, fs)
-			if err != nil {
-				t.Fatalf("failed to get payload checksum")
+			time.Sleep(20 * time.Millisecond)
+		}
+		if !makeTestProposal(follower, 100) {
+			t.Fatalf("failed to make proposal on the majority side")
+		}
+		network.Heal()
+		if !makeTestProposal(nhs[int(leaderID)-1], 100) {
+			t.Fatalf("failed to make proposal after healing the partition")
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
+
+func TestTransportStatsAreUpdated(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		startMemTransportShard(t, nhs, 1)
+		if !makeTestProposal(nhs[0], 100) {
+			t.Fatalf("failed to make proposal")
+		}
+		for i, nh := range nhs {
+			stats := nh.GetTransportStats()
+			if len(stats) != 1 {
+				t.Fatalf("unexpected stats count %d", len(stats))
 			}
-			if !bytes.Equal(crc, snapshot.Checksum) {
-				t.Errorf("checksum changed")
+			ps := stats[0]
+			if ps.Address != memtransport.Address(2-i) {
+				t.Errorf("unexpected address %s", ps.Address)
 			}
-			ss := pb.Snapshot{}
-			if err := fileutil.GetFlagFileContent(fs.PathDir(snapshot.Filepath),
-				"snapshot.metadata", &ss, fs); err != nil {
-				t.Fatalf("failed to get content %v", err)
+			if ps.MessagesSent == 0 || ps.BytesSent == 0 {
+				t.Errorf("sent counters not updated %+v", ps)
 			}
-			if !reflect.DeepEqual(&ss, &snapshot) {
-				t.Errorf("snapshot record changed")
+			if ps.MessagesReceived == 0 || ps.BytesReceived == 0 {
+				t.Errorf("received counters not updated %+v", ps)
 			}
-		},
+			if ps.ConnectionsEstablished == 0 {
+				t.Errorf("connection established count not updated")
+			}
+		}
 	}
-	runNodeHostTest(t, to, fs)
+	memTransportNodeHostTest(t, 2, tf, fs)
 }
 
-func testZombieSnapshotDirWillBeDeletedDuringAddShard(t *testing.T, dirName string, fs vfs.IFS) {
-	var z1 string
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			did := nh.nhConfig.GetDeploymentID()
-			if err := nh.env.CreateSnapshotDir(did, 1, 1); err != nil {
-				t.Fatalf("failed to get snap dir")
-			}
-			snapDir := nh.env.GetSnapshotDir(did, 1, 1)
-			z1 = fs.PathJoin(snapDir, dirName)
-			if err := fs.MkdirAll(z1, 0755); err != nil {
-				t.Fatalf("failed to create dir %v", err)
-			}
-		},
-		rf: func(nh *NodeHost) {
-			_, err := fs.Stat(z1)
-			if !vfs.IsNotExist(err) {
-				t.Fatalf("failed to delete zombie dir")
+func createRateLimitedTwoTestNodeHosts(addr1 string, addr2 string,
+	datadir1 string, datadir2 string,
+	fs vfs.IFS) (*NodeHost, *NodeHost, *tests.NoOP, *tests.NoOP, error) {
+	rc := config.Config{
+		ShardID:         1,
+		ElectionRTT:     3,
+		HeartbeatRTT:    1,
+		CheckQuorum:     true,
+		MaxInMemLogSize: 1024 * 3,
+	}
+	peers := make(map[uint64]string)
+	peers[1] = addr1
+	peers[2] = addr2
+	nhc1 := config.NodeHostConfig{
+		WALDir:         datadir1,
+		NodeHostDir:    datadir1,
+		RTTMillisecond: getRTTMillisecond(fs, datadir1),
+		RaftAddress:    peers[1],
+		Expert:         getTestExpertConfig(fs),
+	}
+	nhc2 := config.NodeHostConfig{
+		WALDir:         datadir2,
+		NodeHostDir:    datadir2,
+		RTTMillisecond: getRTTMillisecond(fs, datadir2),
+		RaftAddress:    peers[2],
+		Expert:         getTestExpertConfig(fs),
+	}
+	network := memtransport.NewNetwork()
+	nhc1.Expert.TransportFactory = network
+	nhc2.Expert.TransportFactory = network
+	nh1, err := NewNodeHost(nhc1)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	nh2, err := NewNodeHost(nhc2)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	sm1 := &tests.NoOP{}
+	sm2 := &tests.NoOP{}
+	newRSM1 := func(shardID uint64, replicaID uint64) sm.IStateMachine {
+		return sm1
+	}
+	newRSM2 := func(shardID uint64, replicaID uint64) sm.IStateMachine {
+		return sm2
+	}
+	rc.ReplicaID = 1
+	if err := nh1.StartReplica(peers, false, newRSM1, rc); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	rc.ReplicaID = 2
+	if err := nh2.StartReplica(peers, false, newRSM2, rc); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	var leaderNh *NodeHost
+	var followerNh *NodeHost
+
+	for i := 0; i < 200; i++ {
+		leaderID, _, ready, err := nh1.GetLeaderID(1)
+		if err == nil && ready {
+			if leaderID == 1 {
+				leaderNh = nh1
+				followerNh = nh2
+				sm2.SetSleepTime(nhc1.RTTMillisecond * 10)
+			} else {
+				leaderNh = nh2
+				followerNh = nh1
+				sm1.SetSleepTime(nhc1.RTTMillisecond * 10)
 			}
-		},
+			return leaderNh, followerNh, sm1, sm2, nil
+		}
+		// wait for leader to be elected
+		time.Sleep(100 * time.Millisecond)
 	}
-	runNodeHostTest(t, to, fs)
+	return nil, nil, nil, nil, errors.New("failed to get usable nodehosts")
 }
 
-func TestZombieSnapshotDirWillBeDeletedDuringAddShard(t *testing.T) {
-	fs := vfs.GetTestFS()
-	defer leaktest.AfterTest(t)()
-	testZombieSnapshotDirWillBeDeletedDuringAddShard(t, "snapshot-AB-01.receiving", fs)
-	testZombieSnapshotDirWillBeDeletedDuringAddShard(t, "snapshot-AB-10.generating", fs)
+func rateLimitedTwoNodeHostTest(t *testing.T,
+	tf func(t *testing.T, leaderNh *NodeHost, followerNh *NodeHost,
+		n1 *tests.NoOP, n2 *tests.NoOP), fs vfs.IFS) {
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	func() {
+		nh1dir := fs.PathJoin(singleNodeHostTestDir, "nh1")
+		nh2dir := fs.PathJoin(singleNodeHostTestDir, "nh2")
+		defer leaktest.AfterTest(t)()
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+		nh1, nh2, n1, n2, err := createRateLimitedTwoTestNodeHosts(nodeHostTestAddr1,
+			nodeHostTestAddr2, nh1dir, nh2dir, fs)
+		if err != nil {
+			t.Fatalf("failed to create nodehost2 %v", err)
+		}
+		defer func() {
+			nh1.Close()
+			nh2.Close()
+		}()
+		tf(t, nh1, nh2, n1, n2)
+	}()
+	reportLeakedFD(fs, t)
 }
 
-func TestNodeHostReadIndex(t *testing.T) {
-	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			pto := lpto(nh)
-			rs, err := nh.ReadIndex(1, pto)
-			if err != nil {
-				t.Errorf("failed to read index %v", err)
-			}
-			if rs.node == nil {
-				t.Fatal("rs.node not set")
-			}
-			v := <-rs.ResultC()
-			if !v.Completed() {
-				t.Errorf("failed to complete read index")
-			}
-			_, err = nh.ReadLocalNode(rs, make([]byte, 128))
-			if err != nil {
-				t.Errorf("read local failed %v", err)
+func waitForLeaderToBeElected(t *testing.T, nh *NodeHost, shardID uint64) {
+	for i := 0; i < 200; i++ {
+		_, term, ready, err := nh.GetLeaderID(shardID)
+		if err == nil && ready {
+			if term == 0 {
+				panic("term is 0")
 			}
-		},
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
-	runNodeHostTest(t, to, fs)
+	t.Fatalf("failed to elect leader")
 }
 
-func TestNALookupCanReturnErrNotImplemented(t *testing.T) {
+func TestJoinedShardCanBeRestartedOrJoinedAgain(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
 		defaultTestNode: true,
 		tf: func(nh *NodeHost) {
-			pto := lpto(nh)
-			rs, err := nh.ReadIndex(1, pto)
-			if err != nil {
-				t.Errorf("failed to read index %v", err)
-			}
-			v := <-rs.ResultC()
-			if !v.Completed() {
-				t.Errorf("failed to complete read index")
+			cfg := getTestConfig()
+			peers := make(map[uint64]string)
+			newPST := func(uint64, uint64) sm.IStateMachine { return &PST{} }
+			if err := nh.StopShard(1); err != nil {
+				t.Fatalf("failed to stop the shard: %v", err)
 			}
-			_, err = nh.NAReadLocalNode(rs, make([]byte, 128))
-			if err != sm.ErrNotImplemented {
-				t.Errorf("failed to return sm.ErrNotImplemented, got %v", err)
+			for i := 0; i < 1000; i++ {
+				err := nh.StartReplica(peers, true, newPST, *cfg)
+				if err == nil {
+					return
+				}
+				if err == ErrShardAlreadyExist {
+					time.Sleep(5 * time.Millisecond)
+					continue
+				} else {
+					t.Fatalf("failed to join the shard again, %v", err)
+				}
 			}
 		},
+		join:       true,
+		noElection: true,
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestNodeHostSyncIOAPIs(t *testing.T) {
+func TestCompactionCanBeRequested(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
 		defaultTestNode: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.SnapshotEntries = 10
+			c.CompactionOverhead = 5
+			c.DisableAutoCompactions = true
+			return c
+		},
 		tf: func(nh *NodeHost) {
-			cs := nh.GetNoOPSession(1)
 			pto := lpto(nh)
+			session := nh.GetNoOPSession(1)
 			ctx, cancel := context.WithTimeout(context.Background(), pto)
 			defer cancel()
-			v, err := nh.SyncPropose(ctx, cs, make([]byte, 128))
-			if err != nil {
-				t.Errorf("make proposal failed %v", err)
-			}
-			if v.Value != 128 {
-				t.Errorf("unexpected result")
-			}
-			data, err := nh.SyncRead(ctx, 1, make([]byte, 128))
+			_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
 			if err != nil {
-				t.Errorf("make linearizable read failed %v", err)
+				t.Fatalf("failed to make proposal, %v", err)
 			}
-			if data == nil || len(data.([]byte)) == 0 {
-				t.Errorf("failed to get result")
+			opt := SnapshotOption{
+				OverrideCompactionOverhead: true,
+				CompactionOverhead:         0,
 			}
-			if err := nh.StopShard(1); err != nil {
-				t.Errorf("failed to stop shard 2 %v", err)
+			if _, err := nh.SyncRequestSnapshot(ctx, 1, opt); err != nil {
+				t.Fatalf("failed to request snapshot %v", err)
 			}
-			listener, ok := nh.events.sys.ul.(*testSysEventListener)
-			if !ok {
-				t.Fatalf("failed to get the system event listener")
+			for i := 0; i < 100; i++ {
+				op, err := nh.RequestCompaction(1, 1)
+				if err == ErrRejected {
+					time.Sleep(100 * time.Millisecond)
+					continue
+				}
+				if err != nil {
+					t.Fatalf("failed to request compaction %v", err)
+				}
+				select {
+				case <-op.ResultC():
+					break
+				case <-ctx.Done():
+					t.Fatalf("failed to complete the compaction")
+				}
+				break
 			}
-			waitNodeInfoEvent(t, listener.getNodeReady, 1)
-			ni := listener.getNodeReady()[0]
-			if ni.ShardID != 1 || ni.ReplicaID != 1 {
-				t.Fatalf("incorrect node ready info")
+			if _, err = nh.RequestCompaction(1, 1); err != ErrRejected {
+				t.Fatalf("not rejected")
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestEntryCompression(t *testing.T) {
+func TestSnapshotCanBeStopped(t *testing.T) {
 	fs := vfs.GetTestFS()
+	pst := &PST{slowSave: true}
 	to := &testOption{
-		defaultTestNode: true,
 		updateConfig: func(c *config.Config) *config.Config {
-			c.EntryCompressionType = config.Snappy
+			c.SnapshotEntries = 10
 			return c
 		},
+		createSM: func(shardID uint64, replicaID uint64) sm.IStateMachine {
+			return pst
+		},
 		tf: func(nh *NodeHost) {
-			cs := nh.GetNoOPSession(1)
-			pto := pto(nh)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			defer cancel()
-			_, err := nh.SyncPropose(ctx, cs, make([]byte, 1024))
-			if err != nil {
-				t.Errorf("make proposal failed %v", err)
-			}
-			logdb := nh.mu.logdb
-			ents, _, err := logdb.IterateEntries(nil, 0, 1, 1, 1, 100, math.MaxUint64)
-			if err != nil {
-				t.Errorf("failed to get entries %v", err)
-			}
-			hasEncodedEntry := false
-			for _, e := range ents {
-				if e.Type == pb.EncodedEntry {
-					hasEncodedEntry = true
-					payload, err := rsm.GetPayload(e)
-					if err != nil {
-						t.Fatalf("failed to get payload %v", err)
-					}
-					if !bytes.Equal(payload, make([]byte, 1024)) {
-						t.Errorf("payload changed")
-					}
-				}
-			}
-			if !hasEncodedEntry {
-				t.Errorf("failed to locate any encoded entry")
+			createProposalsToTriggerSnapshot(t, nh, 50, true)
+		},
+		at: func(*NodeHost) {
+			if !pst.saved || !pst.stopped {
+				t.Errorf("snapshot not stopped")
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestOrderedMembershipChange(t *testing.T) {
+func TestRecoverFromSnapshotCanBeStopped(t *testing.T) {
 	fs := vfs.GetTestFS()
+	pst := &PST{slowSave: false}
 	to := &testOption{
-		defaultTestNode: true,
 		updateConfig: func(c *config.Config) *config.Config {
-			c.OrderedConfigChange = true
+			c.SnapshotEntries = 10
 			return c
 		},
+		createSM: func(shardID uint64, replicaID uint64) sm.IStateMachine {
+			return pst
+		},
 		tf: func(nh *NodeHost) {
-			pto := pto(nh)
-			{
-				ctx, cancel := context.WithTimeout(context.Background(), 2*pto)
-				defer cancel()
-				m, err := nh.SyncGetShardMembership(ctx, 1)
-				if err != nil {
-					t.Fatalf("get membership failed, %v", err)
-				}
-				if err := nh.SyncRequestAddReplica(ctx, 1, 2, "localhost:25000", m.ConfigChangeID+1); err == nil {
-					t.Fatalf("unexpectedly completed")
+			createProposalsToTriggerSnapshot(t, nh, 50, false)
+		},
+		rf: func(nh *NodeHost) {
+			wait := 0
+			for !pst.getRestored() {
+				time.Sleep(10 * time.Millisecond)
+				wait++
+				if wait > 1000 {
+					break
 				}
 			}
-			{
-				ctx, cancel := context.WithTimeout(context.Background(), 2*pto)
-				defer cancel()
-				m, err := nh.SyncGetShardMembership(ctx, 1)
-				if err != nil {
-					t.Fatalf("get membership failed, %v", err)
-				}
-				if err := nh.SyncRequestAddReplica(ctx, 1, 2, "localhost:25000", m.ConfigChangeID); err != nil {
-					t.Fatalf("failed to add node %v", err)
+		},
+		at: func(*NodeHost) {
+			wait := 0
+			for !pst.stopped {
+				time.Sleep(10 * time.Millisecond)
+				wait++
+				if wait > 1000 {
+					break
 				}
 			}
+			if !pst.getRestored() {
+				t.Errorf("not restored")
+			}
+			if !pst.stopped {
+				t.Errorf("not stopped")
+			}
 		},
+		restartNodeHost: true,
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestSyncRequestDeleteReplica(t *testing.T) {
+func TestGetRequestState(t *testing.T) {
+	tests := []struct {
+		code RequestResultCode
+		err  error
+	}{
+		{requestCompleted, nil},
+		{requestRejected, ErrRejected},
+		{requestTimeout, ErrTimeout},
+		{requestTerminated, ErrShardClosed},
+		{requestDropped, ErrShardNotReady},
+		{requestAborted, ErrAborted},
+	}
+
+	for _, tt := range tests {
+		rs := &RequestState{
+			CompletedC: make(chan RequestResult, 1),
+		}
+		result := RequestResult{code: tt.code}
+		rs.notify(result)
+		if _, err := getRequestState(context.TODO(), rs); !errors.Is(err, tt.err) {
+			t.Errorf("expect error %v, got %v", tt.err, err)
+		}
+	}
+}
+
+func TestGetRequestStateTimeoutAndCancel(t *testing.T) {
+	func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		time.Sleep(2 * time.Millisecond)
+		rs := &RequestState{
+			CompletedC: make(chan RequestResult, 1),
+		}
+		if _, err := getRequestState(ctx, rs); !errors.Is(err, ErrTimeout) {
+			t.Errorf("got %v", err)
+		}
+	}()
+
+	func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		cancel()
+		rs := &RequestState{
+			CompletedC: make(chan RequestResult, 1),
+		}
+		if _, err := getRequestState(ctx, rs); !errors.Is(err, ErrCanceled) {
+			t.Errorf("got %v", err)
+		}
+	}()
+}
+
+func TestNodeHostIDIsStatic(t *testing.T) {
 	fs := vfs.GetTestFS()
+	id := ""
 	to := &testOption{
-		defaultTestNode: true,
+		restartNodeHost: true,
+		noElection:      true,
 		tf: func(nh *NodeHost) {
-			pto := lpto(nh)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			defer cancel()
-			err := nh.SyncRequestDeleteReplica(ctx, 1, 2, 0)
-			if err != nil {
-				t.Errorf("failed to delete node %v", err)
-			}
-			listener, ok := nh.events.sys.ul.(*testSysEventListener)
-			if !ok {
-				t.Fatalf("failed to get the system event listener")
-			}
-			waitNodeInfoEvent(t, listener.getMembershipChanged, 2)
-			ni := listener.getMembershipChanged()[1]
-			if ni.ShardID != 1 || ni.ReplicaID != 1 {
-				t.Fatalf("incorrect membership changed info")
+			id = nh.ID()
+		},
+		rf: func(nh *NodeHost) {
+			if nh.ID() != id {
+				t.Fatalf("NodeHost ID value changed")
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestSyncRequestAddReplica(t *testing.T) {
+func TestNodeHostIDCanBeSet(t *testing.T) {
 	fs := vfs.GetTestFS()
+	nhid := testNodeHostID1
 	to := &testOption{
-		defaultTestNode: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.NodeHostID = nhid
+			return c
+		},
+		noElection: true,
 		tf: func(nh *NodeHost) {
-			pto := pto(nh)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			defer cancel()
-			err := nh.SyncRequestAddReplica(ctx, 1, 2, "localhost:25000", 0)
+			nhid, err := id.NewUUID(nhid)
 			if err != nil {
-				t.Errorf("failed to add node %v", err)
+				t.Fatalf("failed to create NodeHostID")
+			}
+			if nh.ID() != nhid.String() {
+				t.Fatalf("failed to set nhid")
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestSyncRequestAddNonVoting(t *testing.T) {
+func TestInvalidAddressIsRejected(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
 		defaultTestNode: true,
@@ -2461,3037 +3336,5717 @@ func TestSyncRequestAddNonVoting(t *testing.T) {
 			pto := pto(nh)
 			ctx, cancel := context.WithTimeout(context.Background(), pto)
 			defer cancel()
-			err := nh.SyncRequestAddNonVoting(ctx, 1, 2, "localhost:25000", 0)
-			if err != nil {
-				t.Errorf("failed to add nonVoting %v", err)
+			err := nh.SyncRequestAddReplica(ctx, 1, 100, "a1", 0)
+			if err != ErrInvalidAddress {
+				t.Errorf("failed to return ErrInvalidAddress, %v", err)
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestNodeHostAddReplica(t *testing.T) {
+func TestInvalidContextDeadlineIsReported(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
 		defaultTestNode: true,
 		tf: func(nh *NodeHost) {
-			pto := pto(nh)
-			rs, err := nh.RequestAddReplica(1, 2, "localhost:25000", 0, pto)
+			pto := lpto(nh)
+			rctx, rcancel := context.WithTimeout(context.Background(), pto)
+			rcs, err := nh.SyncGetSession(rctx, 1)
+			rcancel()
 			if err != nil {
-				t.Errorf("failed to add node %v", err)
+				t.Fatalf("failed to get regular session")
 			}
-			v := <-rs.ResultC()
-			if !v.Completed() {
-				t.Errorf("failed to complete add node")
+			// 8 * time.Millisecond is smaller than the smallest possible RTTMillisecond
+			ctx, cancel := context.WithTimeout(context.Background(), 8*time.Millisecond)
+			defer cancel()
+			cs := nh.GetNoOPSession(1)
+			_, err = nh.SyncPropose(ctx, cs, make([]byte, 1))
+			if err != ErrTimeoutTooSmall {
+				t.Errorf("failed to return ErrTimeoutTooSmall, %v", err)
 			}
-		},
-	}
-	runNodeHostTest(t, to, fs)
-}
-
-func TestNodeHostGetNodeUser(t *testing.T) {
-	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			n, err := nh.GetNodeUser(1)
-			if err != nil {
-				t.Errorf("failed to get NodeUser")
+			_, err = nh.SyncRead(ctx, 1, nil)
+			if err != ErrTimeoutTooSmall {
+				t.Errorf("failed to return ErrTimeoutTooSmall, %v", err)
 			}
-			if n == nil {
-				t.Errorf("got a nil NodeUser")
+			_, err = nh.SyncGetSession(ctx, 1)
+			if err != ErrTimeoutTooSmall {
+				t.Errorf("failed to return ErrTimeoutTooSmall, %v", err)
 			}
-			n, err = nh.GetNodeUser(123)
-			if err != ErrShardNotFound {
-				t.Errorf("didn't return expected err")
+			err = nh.SyncCloseSession(ctx, rcs)
+			if err != ErrTimeoutTooSmall {
+				t.Errorf("failed to return ErrTimeoutTooSmall, %v", err)
 			}
-			if n != nil {
-				t.Errorf("got unexpected node user")
+			_, err = nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption)
+			if err != ErrTimeoutTooSmall {
+				t.Errorf("failed to return ErrTimeoutTooSmall, %v", err)
 			}
-		},
-	}
-	runNodeHostTest(t, to, fs)
-}
-
-func TestNodeHostNodeUserPropose(t *testing.T) {
-	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			pto := pto(nh)
-			n, err := nh.GetNodeUser(1)
-			if err != nil {
-				t.Errorf("failed to get NodeUser")
+			err = nh.SyncRequestDeleteReplica(ctx, 1, 1, 0)
+			if err != ErrTimeoutTooSmall {
+				t.Errorf("failed to return ErrTimeoutTooSmall, %v", err)
 			}
-			cs := nh.GetNoOPSession(1)
-			rs, err := n.Propose(cs, make([]byte, 16), pto)
-			if err != nil {
-				t.Errorf("failed to make propose %v", err)
+			err = nh.SyncRequestAddReplica(ctx, 1, 100, "a1.com:12345", 0)
+			if err != ErrTimeoutTooSmall {
+				t.Errorf("failed to return ErrTimeoutTooSmall, %v", err)
 			}
-			v := <-rs.ResultC()
-			if !v.Completed() {
-				t.Errorf("failed to complete proposal")
+			err = nh.SyncRequestAddNonVoting(ctx, 1, 100, "a1.com:12345", 0)
+			if err != ErrTimeoutTooSmall {
+				t.Errorf("failed to return ErrTimeoutTooSmall, %v", err)
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestNodeHostNodeUserRead(t *testing.T) {
+func TestErrShardNotFoundCanBeReturned(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
 		defaultTestNode: true,
 		tf: func(nh *NodeHost) {
-			pto := pto(nh)
-			n, err := nh.GetNodeUser(1)
-			if err != nil {
-				t.Errorf("failed to get NodeUser")
-			}
-			rs, err := n.ReadIndex(pto)
-			if err != nil {
-				t.Errorf("failed to read index %v", err)
-			}
-			v := <-rs.ResultC()
-			if !v.Completed() {
-				t.Errorf("failed to complete read index")
-			}
-		},
-	}
-	runNodeHostTest(t, to, fs)
-}
-
-func TestNodeHostAddNonVotingRemoveNode(t *testing.T) {
-	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			pto := pto(nh)
-			rs, err := nh.RequestAddNonVoting(1, 2, "localhost:25000", 0, pto)
-			if err != nil {
-				t.Errorf("failed to add node %v", err)
-			}
-			v := <-rs.ResultC()
-			if !v.Completed() {
-				t.Errorf("failed to complete add node")
-			}
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			defer cancel()
-			membership, err := nh.SyncGetShardMembership(ctx, 1)
-			if err != nil {
-				t.Fatalf("failed to get shard membership %v", err)
+			pto := lpto(nh)
+			_, _, _, err := nh.GetLeaderID(1234)
+			if err != ErrShardNotFound {
+				t.Errorf("failed to return ErrShardNotFound, %v", err)
 			}
-			if len(membership.Nodes) != 1 || len(membership.Removed) != 0 {
-				t.Errorf("unexpected nodes/removed len")
+			_, err = nh.StaleRead(1234, nil)
+			if err != ErrShardNotFound {
+				t.Errorf("failed to return ErrShardNotFound, %v", err)
 			}
-			if len(membership.NonVotings) != 1 {
-				t.Errorf("unexpected nodes len")
+			_, err = nh.RequestSnapshot(1234, DefaultSnapshotOption, pto)
+			if err != ErrShardNotFound {
+				t.Errorf("failed to return ErrShardNotFound, %v", err)
 			}
-			_, ok := membership.NonVotings[2]
-			if !ok {
-				t.Errorf("node 2 not added")
+			_, err = nh.RequestDeleteReplica(1234, 10, 0, pto)
+			if err != ErrShardNotFound {
+				t.Errorf("failed to return ErrShardNotFound, %v", err)
 			}
-			// remove it
-			rs, err = nh.RequestDeleteReplica(1, 2, 0, pto)
-			if err != nil {
-				t.Errorf("failed to remove node %v", err)
+			_, err = nh.RequestAddReplica(1234, 10, "a1", 0, pto)
+			if err != ErrShardNotFound {
+				t.Errorf("failed to return ErrShardNotFound, %v", err)
 			}
-			v = <-rs.ResultC()
-			if !v.Completed() {
-				t.Errorf("failed to complete remove node")
+			_, err = nh.RequestAddNonVoting(1234, 10, "a1", 0, pto)
+			if err != ErrShardNotFound {
+				t.Errorf("failed to return ErrShardNotFound, %v", err)
 			}
-			ctx, cancel = context.WithTimeout(context.Background(), pto)
-			defer cancel()
-			membership, err = nh.SyncGetShardMembership(ctx, 1)
-			if err != nil {
-				t.Fatalf("failed to get shard membership %v", err)
+			err = nh.RequestLeaderTransfer(1234, 10)
+			if err != ErrShardNotFound {
+				t.Errorf("failed to return ErrShardNotFound, %v", err)
 			}
-			if len(membership.Nodes) != 1 || len(membership.Removed) != 1 {
-				t.Errorf("unexpected nodes/removed len")
+			_, err = nh.GetNodeUser(1234)
+			if err != ErrShardNotFound {
+				t.Errorf("failed to return ErrShardNotFound, %v", err)
 			}
-			if len(membership.NonVotings) != 0 {
-				t.Errorf("unexpected nodes len")
+			cs := nh.GetNoOPSession(1234)
+			_, err = nh.propose(context.Background(), cs, make([]byte, 1), pto)
+			if err != ErrShardNotFound {
+				t.Errorf("failed to return ErrShardNotFound, %v", err)
 			}
-			_, ok = membership.Removed[2]
-			if !ok {
-				t.Errorf("node 2 not removed")
+			_, _, err = nh.readIndex(context.Background(), 1234, pto)
+			if err != ErrShardNotFound {
+				t.Errorf("failed to return ErrShardNotFound, %v", err)
 			}
-		},
-	}
-	runNodeHostTest(t, to, fs)
-}
-
-// FIXME:
-// Leadership transfer is not actually tested
-func TestNodeHostLeadershipTransfer(t *testing.T) {
-	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			if err := nh.RequestLeaderTransfer(1, 1); err != nil {
-				t.Errorf("leader transfer failed %v", err)
+			err = nh.stopNode(1234, 1, true)
+			if err != ErrShardNotFound {
+				t.Errorf("failed to return ErrShardNotFound, %v", err)
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestNodeHostHasNodeInfo(t *testing.T) {
+func TestGetShardMembership(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
 		defaultTestNode: true,
 		tf: func(nh *NodeHost) {
-			if ok := nh.HasNodeInfo(1, 1); !ok {
-				t.Errorf("node info missing")
-			}
-			if ok := nh.HasNodeInfo(1, 2); ok {
-				t.Errorf("unexpected node info")
-			}
-		},
-	}
-	runNodeHostTest(t, to, fs)
-}
-
-func TestOnDiskStateMachineDoesNotSupportClientSession(t *testing.T) {
-	fs := vfs.GetTestFS()
-	to := &testOption{
-		fakeDiskNode: true,
-		tf: func(nh *NodeHost) {
-			defer func() {
-				if r := recover(); r == nil {
-					t.Fatalf("no panic when proposing session on disk SM")
-				}
-			}()
 			pto := pto(nh)
 			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			_, err := nh.SyncGetSession(ctx, 1)
-			cancel()
-			if err == nil {
-				t.Fatalf("managed to get new session")
+			defer cancel()
+			_, err := nh.SyncGetShardMembership(ctx, 1)
+			if err != nil {
+				t.Fatalf("failed to get shard membership")
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestStaleReadOnUninitializedNodeReturnError(t *testing.T) {
+func TestRegisterASessionTwiceWillBeReported(t *testing.T) {
 	fs := vfs.GetTestFS()
-	fakeDiskSM := tests.NewFakeDiskSM(0)
-	atomic.StoreUint32(&fakeDiskSM.SlowOpen, 1)
 	to := &testOption{
-		createOnDiskSM: func(uint64, uint64) sm.IOnDiskStateMachine {
-			return fakeDiskSM
-		},
+		defaultTestNode: true,
 		tf: func(nh *NodeHost) {
-			n, ok := nh.getShard(1)
-			if !ok {
-				t.Fatalf("failed to get the node")
-			}
-			if n.initialized() {
-				t.Fatalf("node unexpectedly initialized")
-			}
-			if _, err := nh.StaleRead(1, nil); err != ErrShardNotInitialized {
-				t.Fatalf("expected to return ErrShardNotInitialized")
-			}
-			atomic.StoreUint32(&fakeDiskSM.SlowOpen, 0)
-			for !n.initialized() {
-				runtime.Gosched()
+			pto := lpto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			defer cancel()
+			cs, err := nh.SyncGetSession(ctx, 1)
+			if err != nil {
+				t.Errorf("failed to get client session %v", err)
 			}
-			v, err := nh.StaleRead(1, nil)
+			cs.PrepareForRegister()
+			rs, err := nh.ProposeSession(cs, pto)
 			if err != nil {
-				t.Fatalf("stale read failed %v", err)
+				t.Errorf("failed to propose client session %v", err)
 			}
-			if len(v.([]byte)) != 8 {
-				t.Fatalf("unexpected result %v", v)
+			r := <-rs.ResultC()
+			if !r.Rejected() {
+				t.Errorf("failed to reject the cs registeration")
 			}
 		},
-		noElection: true,
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestStartReplicaWaitForReadiness(t *testing.T) {
+func TestUnregisterNotRegisterClientSessionWillBeReported(t *testing.T) {
 	fs := vfs.GetTestFS()
-	fakeDiskSM := tests.NewFakeDiskSM(0)
-	atomic.StoreUint32(&fakeDiskSM.SlowOpen, 1)
 	to := &testOption{
-		defaultTestNode: false,
-		noElection:      true,
+		defaultTestNode: true,
 		tf: func(nh *NodeHost) {
-			cfg := getTestConfig()
-			cfg.WaitReady = true
-
-			go func() {
-				defer atomic.StoreUint32(&fakeDiskSM.SlowOpen, 0)
-				var n *node
-				var ok bool
-
-				for i := 0; i < 10; i++ {
-					n, ok = nh.getShard(cfg.ShardID)
-					if ok {
-						break
-					}
-					time.Sleep(time.Millisecond * 100)
-				}
-				if !ok {
-					t.Errorf("failed to get the node")
-				}
-				if n.initialized() {
-					t.Errorf("node unexpectedly initialized")
-				}
-				if _, err := nh.StaleRead(1, nil); err != ErrShardNotInitialized {
-					t.Errorf("expected to return ErrShardNotInitialized")
-				}
-			}()
-
-			initialMembers := map[uint64]Target{
-				1: nh.RaftAddress(),
-			}
-
-			err := nh.StartOnDiskReplica(initialMembers, false, func(shardID uint64, replicaID uint64) sm.IOnDiskStateMachine {
-				return fakeDiskSM
-			}, *cfg)
+			pto := lpto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			defer cancel()
+			cs, err := nh.SyncGetSession(ctx, 1)
 			if err != nil {
-				t.Fatalf("failed to StartOnDiskReplica: %v", err)
+				t.Errorf("failed to get client session %v", err)
 			}
-
-			v, err := nh.StaleRead(1, nil)
+			err = nh.SyncCloseSession(ctx, cs)
 			if err != nil {
-				t.Fatalf("stale read failed %v", err)
+				t.Errorf("failed to unregister the client session %v", err)
 			}
-			if len(v.([]byte)) != 8 {
-				t.Fatalf("unexpected result %v", v)
+			err = nh.SyncCloseSession(ctx, cs)
+			if err != ErrRejected {
+				t.Errorf("failed to reject the request %v", err)
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func testOnDiskStateMachineCanTakeDummySnapshot(t *testing.T, compressed bool) {
+func TestSnapshotFilePayloadChecksumIsSaved(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
-		fakeDiskNode: true,
-		compressed:   compressed,
+		defaultTestNode: true,
 		updateConfig: func(c *config.Config) *config.Config {
-			c.SnapshotEntries = 30
-			c.CompactionOverhead = 30
+			c.SnapshotEntries = 10
 			return c
 		},
 		tf: func(nh *NodeHost) {
-			session := nh.GetNoOPSession(1)
+			cs := nh.GetNoOPSession(1)
 			logdb := nh.mu.logdb
 			snapshotted := false
-			var ss pb.Snapshot
-			for i := uint64(2); i < 1000; i++ {
+			var snapshot pb.Snapshot
+			for i := 0; i < 1000; i++ {
 				pto := pto(nh)
 				ctx, cancel := context.WithTimeout(context.Background(), pto)
-				_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
+				_, err := nh.SyncPropose(ctx, cs, []byte("test-data"))
 				cancel()
 				if err != nil {
 					continue
 				}
-				snapshot, err := logdb.GetSnapshot(1, 1)
+				ss, err := logdb.GetSnapshot(1, 1)
 				if err != nil {
-					t.Fatalf("list snapshot failed %v", err)
+					t.Fatalf("failed to list snapshots")
 				}
-				if !pb.IsEmptySnapshot(snapshot) {
+				if !pb.IsEmptySnapshot(ss) {
 					snapshotted = true
-					ss = snapshot
-					if !ss.Dummy {
-						t.Fatalf("dummy snapshot is not recorded as dummy")
-					}
+					snapshot = ss
 					break
-				} else if i%100 == 0 {
-					// this is an ugly hack to workaround RocksDB's incorrect fsync
-					// implementation on macos.
-					// fcntl(fd, F_FULLFSYNC) is required for a proper fsync on macos,
-					// sadly rocksdb is not doing that. this means we can make proposals
-					// very fast as they are not actually fsynced on macos but making
-					// snapshots are going to be much much slower as dragonboat properly
-					// fsyncs its snapshot data. we can end up completing all required
-					// proposals even before completing the first ongoing snapshotting
-					// operation.
-					time.Sleep(200 * time.Millisecond)
 				}
 			}
 			if !snapshotted {
-				t.Fatalf("failed to snapshot")
+				t.Fatalf("snapshot not triggered")
 			}
-			fi, err := fs.Stat(ss.Filepath)
+			crc, err := rsm.GetV2PayloadChecksum(snapshot.Filepath, fs)
 			if err != nil {
-				t.Fatalf("failed to get file st %v", err)
+				t.Fatalf("failed to get payload checksum")
 			}
-			if fi.Size() != 1060 {
-				t.Fatalf("unexpected dummy snapshot file size %d", fi.Size())
+			if !bytes.Equal(crc, snapshot.Checksum) {
+				t.Errorf("checksum changed")
 			}
-			reader, h, err := rsm.NewSnapshotReader(ss.Filepath, fs)
+			ss := pb.Snapshot{}
+			if err := fileutil.GetFlagFileContent(fs.PathDir(snapshot.Filepath),
+				"snapshot.metadata", &ss, fs); err != nil {
+				t.Fatalf("failed to get content %v", err)
+			}
+			if !reflect.DeepEqual(&ss, &snapshot) {
+				t.Errorf("snapshot record changed")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func testZombieSnapshotDirWillBeDeletedDuringAddShard(t *testing.T, dirName string, fs vfs.IFS) {
+	var z1 string
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			did := nh.nhConfig.GetDeploymentID()
+			if err := nh.env.CreateSnapshotDir(did, 1, 1); err != nil {
+				t.Fatalf("failed to get snap dir")
+			}
+			snapDir := nh.env.GetSnapshotDir(did, 1, 1)
+			z1 = fs.PathJoin(snapDir, dirName)
+			if err := fs.MkdirAll(z1, 0755); err != nil {
+				t.Fatalf("failed to create dir %v", err)
+			}
+		},
+		rf: func(nh *NodeHost) {
+			_, err := fs.Stat(z1)
+			if !vfs.IsNotExist(err) {
+				t.Fatalf("failed to delete zombie dir")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestZombieSnapshotDirWillBeDeletedDuringAddShard(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	testZombieSnapshotDirWillBeDeletedDuringAddShard(t, "snapshot-AB-01.receiving", fs)
+	testZombieSnapshotDirWillBeDeletedDuringAddShard(t, "snapshot-AB-10.generating", fs)
+}
+
+func TestNodeHostReadIndex(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			pto := lpto(nh)
+			rs, err := nh.ReadIndex(1, pto)
 			if err != nil {
-				t.Fatalf("failed to read snapshot %v", err)
+				t.Errorf("failed to read index %v", err)
 			}
-			// dummy snapshot is always not compressed
-			if h.CompressionType != config.NoCompression {
-				t.Errorf("dummy snapshot compressed")
+			if rs.node == nil {
+				t.Fatal("rs.node not set")
 			}
-			if rsm.SSVersion(h.Version) != rsm.DefaultVersion {
-				t.Errorf("unexpected snapshot version, got %d, want %d",
-					h.Version, rsm.DefaultVersion)
+			v := <-rs.ResultC()
+			if !v.Completed() {
+				t.Errorf("failed to complete read index")
 			}
-			_ = reader.Close()
-			shrunk, err := rsm.IsShrunkSnapshotFile(ss.Filepath, fs)
+			_, err = nh.ReadLocalNode(rs, make([]byte, 128))
 			if err != nil {
-				t.Fatalf("failed to check shrunk %v", err)
+				t.Errorf("read local failed %v", err)
 			}
-			if !shrunk {
-				t.Errorf("not a dummy snapshot")
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestNALookupCanReturnErrNotImplemented(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			pto := lpto(nh)
+			rs, err := nh.ReadIndex(1, pto)
+			if err != nil {
+				t.Errorf("failed to read index %v", err)
+			}
+			v := <-rs.ResultC()
+			if !v.Completed() {
+				t.Errorf("failed to complete read index")
+			}
+			_, err = nh.NAReadLocalNode(rs, make([]byte, 128))
+			if err != sm.ErrNotImplemented {
+				t.Errorf("failed to return sm.ErrNotImplemented, got %v", err)
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestOnDiskStateMachineCanTakeDummySnapshot(t *testing.T) {
-	testOnDiskStateMachineCanTakeDummySnapshot(t, true)
-	testOnDiskStateMachineCanTakeDummySnapshot(t, false)
+// byteLookupTestSM is a state machine serving byte oriented reads without any
+// heap allocation.
+type byteLookupTestSM struct {
+	PST
+	result []byte
 }
 
-func TestOnDiskSMCanStreamSnapshot(t *testing.T) {
+func (s *byteLookupTestSM) LookupBytes(query []byte) ([]byte, error) {
+	return s.result, nil
+}
+
+func TestByteLookupIsUsedByNAReads(t *testing.T) {
 	fs := vfs.GetTestFS()
-	tf := func(t *testing.T, nh1 *NodeHost, nh2 *NodeHost) {
-		rc := config.Config{
-			ShardID:                 1,
-			ReplicaID:               1,
-			ElectionRTT:             3,
-			HeartbeatRTT:            1,
-			CheckQuorum:             true,
-			SnapshotEntries:         5,
-			CompactionOverhead:      2,
-			SnapshotCompressionType: config.Snappy,
-			EntryCompressionType:    config.Snappy,
-		}
-		sm1 := tests.NewFakeDiskSM(0)
-		sm1.SetAborted()
-		peers := make(map[uint64]string)
-		peers[1] = nodeHostTestAddr1
-		newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
-			return sm1
-		}
-		if err := nh1.StartOnDiskReplica(peers, false, newSM, rc); err != nil {
-			t.Fatalf("failed to start shard %v", err)
-		}
-		waitForLeaderToBeElected(t, nh1, 1)
-		logdb := nh1.mu.logdb
-		snapshotted := false
-		session := nh1.GetNoOPSession(1)
-		for i := uint64(2); i < 1000; i++ {
-			pto := pto(nh1)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			_, err := nh1.SyncPropose(ctx, session, []byte("test-data"))
-			cancel()
+	result := []byte("byte-lookup")
+	to := &testOption{
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &byteLookupTestSM{result: result}
+		},
+		tf: func(nh *NodeHost) {
+			waitForLeaderToBeElected(t, nh, 1)
+			pto := lpto(nh)
+			rs, err := nh.ReadIndex(1, pto)
 			if err != nil {
-				time.Sleep(100 * time.Millisecond)
-				continue
+				t.Fatalf("failed to read index %v", err)
 			}
-			snapshot, err := logdb.GetSnapshot(1, 1)
+			if v := <-rs.ResultC(); !v.Completed() {
+				t.Fatalf("failed to complete read index")
+			}
+			data, err := nh.NAReadLocalNode(rs, []byte("query"))
 			if err != nil {
-				t.Fatalf("list snapshot failed %v", err)
+				t.Fatalf("NAReadLocalNode failed %v", err)
 			}
-			if !pb.IsEmptySnapshot(snapshot) {
-				snapshotted = true
-				break
-			} else if i%50 == 0 {
-				// see comments in testOnDiskStateMachineCanTakeDummySnapshot
-				time.Sleep(100 * time.Millisecond)
+			if !bytes.Equal(data, result) {
+				t.Errorf("unexpected result %s", data)
 			}
-		}
-		if !snapshotted {
-			t.Fatalf("failed to take 3 snapshots")
-		}
-		pto := pto(nh1)
-		rs, err := nh1.RequestAddReplica(1, 2, nodeHostTestAddr2, 0, pto)
-		if err != nil {
-			t.Fatalf("failed to add node %v", err)
-		}
-		s := <-rs.ResultC()
-		if !s.Completed() {
-			t.Fatalf("failed to complete the add node request")
-		}
-		rc = config.Config{
-			ShardID:            1,
-			ReplicaID:          2,
-			ElectionRTT:        3,
-			HeartbeatRTT:       1,
-			CheckQuorum:        true,
-			SnapshotEntries:    5,
-			CompactionOverhead: 2,
-		}
-		sm2 := tests.NewFakeDiskSM(0)
-		sm2.SetAborted()
-		newSM2 := func(uint64, uint64) sm.IOnDiskStateMachine {
-			return sm2
-		}
-		sm1.ClearAborted()
-		if err := nh2.StartOnDiskReplica(nil, true, newSM2, rc); err != nil {
-			t.Fatalf("failed to start shard %v", err)
-		}
-		ssIndex := uint64(0)
-		logdb = nh2.mu.logdb
-		waitForLeaderToBeElected(t, nh2, 1)
-		for i := uint64(2); i < 1000; i++ {
+			rs.Release()
 			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			_, err := nh2.SyncPropose(ctx, session, []byte("test-data"))
-			cancel()
-			plog.Infof("nh2 proposal result: %v", err)
+			defer cancel()
+			data, err = nh.NASyncRead(ctx, 1, []byte("query"))
 			if err != nil {
-				time.Sleep(100 * time.Millisecond)
-				continue
+				t.Fatalf("NASyncRead failed %v", err)
 			}
-			ss, err := logdb.GetSnapshot(1, 2)
-			if err != nil {
-				t.Fatalf("list snapshot failed %v", err)
+			if !bytes.Equal(data, result) {
+				t.Errorf("unexpected result %s", data)
 			}
-			if !pb.IsEmptySnapshot(ss) {
-				if !sm2.Recovered() {
-					t.Fatalf("not recovered")
-				}
-				if !sm1.Aborted() {
-					t.Fatalf("not aborted")
-				}
-				if ss.OnDiskIndex == 0 {
-					t.Errorf("on disk index not recorded in ss")
-				}
-				shrunk, err := rsm.IsShrunkSnapshotFile(ss.Filepath, fs)
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestByteLookupReadPathDoesNotAllocate(t *testing.T) {
+	if invariants.Race {
+		t.Skip("allocations are not accurately counted in race mode")
+	}
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &byteLookupTestSM{result: make([]byte, 8)}
+		},
+		tf: func(nh *NodeHost) {
+			waitForLeaderToBeElected(t, nh, 1)
+			pto := lpto(nh)
+			query := make([]byte, 8)
+			read := func() {
+				rs, err := nh.ReadIndex(1, pto)
 				if err != nil {
-					t.Errorf("failed to check whether snapshot is shrunk %v", err)
+					t.Fatalf("failed to read index %v", err)
 				}
-				if !shrunk {
-					t.Errorf("snapshot %d is not shrunk", ss.Index)
+				if v := <-rs.ResultC(); !v.Completed() {
+					t.Fatalf("failed to complete read index")
 				}
-				if ssIndex == 0 {
-					ssIndex = ss.Index
-				} else {
-					if ssIndex != ss.Index {
-						break
-					}
+				if _, err := nh.NAReadLocalNode(rs, query); err != nil {
+					t.Fatalf("NAReadLocalNode failed %v", err)
 				}
-			} else if i%50 == 0 {
-				// see comments in testOnDiskStateMachineCanTakeDummySnapshot
-				time.Sleep(100 * time.Millisecond)
+				rs.Release()
 			}
-		}
-		if ssIndex == 0 {
-			t.Fatalf("failed to take 2 snapshots")
-		}
-		listener, ok := nh2.events.sys.ul.(*testSysEventListener)
-		if !ok {
-			t.Fatalf("failed to get the system event listener")
-		}
-		if len(listener.getSnapshotReceived()) == 0 {
-			t.Fatalf("snapshot received not notified")
-		}
-		if len(listener.getSnapshotRecovered()) == 0 {
-			t.Fatalf("failed to be notified for recovered snapshot")
-		}
-		if len(listener.getLogCompacted()) == 0 {
-			t.Fatalf("log compaction not notified")
-		}
-		listener, ok = nh1.events.sys.ul.(*testSysEventListener)
-		if !ok {
-			t.Fatalf("failed to get the system event listener")
-		}
-		if len(listener.getSendSnapshotStarted()) == 0 {
-			t.Fatalf("send snapshot started not notified")
-		}
-		if len(listener.getSendSnapshotCompleted()) == 0 {
-			t.Fatalf("send snapshot completed not notified")
-		}
-		if listener.getConnectionEstablished() == 0 {
-			t.Fatalf("connection established not notified")
-		}
-	}
-	twoFakeDiskNodeHostTest(t, tf, fs)
-}
-
-func TestConcurrentStateMachineLookup(t *testing.T) {
-	fs := vfs.GetTestFS()
-	done := uint32(0)
-	tf := func(t *testing.T, nh *NodeHost) {
-		nhc := nh.NodeHostConfig()
-		shardID := 1 + nhc.Expert.Engine.ApplyShards
-		count := uint32(0)
-		stopper := syncutil.NewStopper()
-		pto := pto(nh)
-		stopper.RunWorker(func() {
-			for i := 0; i < 10000; i++ {
-				ctx, cancel := context.WithTimeout(context.Background(), pto)
-				session := nh.GetNoOPSession(shardID)
-				_, err := nh.SyncPropose(ctx, session, []byte("test"))
-				cancel()
-				if err == ErrTimeout {
-					continue
-				}
-				if err != nil {
-					t.Fatalf("failed to make proposal %v", err)
-				}
-				if atomic.LoadUint32(&count) > 0 {
-					return
-				}
+			if allocs := testing.AllocsPerRun(1000, read); allocs != 0 {
+				t.Errorf("%f allocations per read", allocs)
 			}
-		})
-		stopper.RunWorker(func() {
-			for i := 0; i < 10000; i++ {
-				if i%5 == 0 {
-					time.Sleep(time.Millisecond)
-				}
-				rs, err := nh.ReadIndex(shardID, pto)
-				if err != nil {
-					continue
-				}
-				s := <-rs.ResultC()
-				if !s.Completed() {
-					continue
-				}
-				st := random.LockGuardedRand.Uint64()%7 + 1
-				time.Sleep(time.Duration(st) * time.Millisecond)
-				result, err := nh.ReadLocalNode(rs, []byte("test"))
-				if err != nil {
-					continue
-				}
-				v := binary.LittleEndian.Uint32(result.([]byte))
-				if v%2 == 1 {
-					atomic.AddUint32(&count, 1)
-					atomic.StoreUint32(&done, 1)
-					return
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			defer cancel()
+			allocs := testing.AllocsPerRun(1000, func() {
+				if _, err := nh.NASyncRead(ctx, 1, query); err != nil {
+					t.Fatalf("NASyncRead failed %v", err)
 				}
+			})
+			if allocs != 0 {
+				t.Errorf("%f allocations per NASyncRead", allocs)
 			}
-		})
-		stopper.Stop()
-		if atomic.LoadUint32(&done) == 0 {
-			t.Fatalf("failed to have any concurrent read")
-		}
+		},
 	}
-	singleConcurrentNodeHostTest(t, tf, 0, true, fs)
+	runNodeHostTest(t, to, fs)
 }
 
-func TestConcurrentStateMachineSaveSnapshot(t *testing.T) {
+func TestNodeHostSyncIOAPIs(t *testing.T) {
 	fs := vfs.GetTestFS()
-	tf := func(t *testing.T, nh *NodeHost) {
-		nhc := nh.NodeHostConfig()
-		shardID := 1 + nhc.Expert.Engine.ApplyShards
-		nhi := nh.GetNodeHostInfo(DefaultNodeHostInfoOption)
-		for _, ci := range nhi.ShardInfoList {
-			if ci.ShardID == shardID {
-				if ci.StateMachineType != sm.ConcurrentStateMachine {
-					t.Errorf("unexpected state machine type")
-				}
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			cs := nh.GetNoOPSession(1)
+			pto := lpto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			defer cancel()
+			v, err := nh.SyncPropose(ctx, cs, make([]byte, 128))
+			if err != nil {
+				t.Errorf("make proposal failed %v", err)
 			}
-			if ci.IsNonVoting {
-				t.Errorf("unexpected IsNonVoting value")
+			if v.Value != 128 {
+				t.Errorf("unexpected result")
 			}
-		}
-		result := make(map[uint64]struct{})
-		session := nh.GetNoOPSession(shardID)
-		pto := pto(nh)
-		for i := 0; i < 10000; i++ {
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			v, err := nh.SyncPropose(ctx, session, []byte("test"))
-			cancel()
+			data, err := nh.SyncRead(ctx, 1, make([]byte, 128))
 			if err != nil {
-				t.Fatalf("failed to make proposal %v", err)
+				t.Errorf("make linearizable read failed %v", err)
 			}
-			result[v.Value] = struct{}{}
-			if len(result) > 1 {
-				return
+			if data == nil || len(data.([]byte)) == 0 {
+				t.Errorf("failed to get result")
 			}
-			time.Sleep(time.Millisecond)
-		}
-		t.Fatalf("failed to make proposal when saving snapshots")
+			if err := nh.StopShard(1); err != nil {
+				t.Errorf("failed to stop shard 2 %v", err)
+			}
+			listener, ok := nh.events.sys.ul.(*testSysEventListener)
+			if !ok {
+				t.Fatalf("failed to get the system event listener")
+			}
+			waitNodeInfoEvent(t, listener.getNodeReady, 1)
+			ni := listener.getNodeReady()[0]
+			if ni.ShardID != 1 || ni.ReplicaID != 1 {
+				t.Fatalf("incorrect node ready info")
+			}
+		},
 	}
-	singleConcurrentNodeHostTest(t, tf, 10, true, fs)
+	runNodeHostTest(t, to, fs)
 }
 
-func TestErrorCanBeReturnedWhenLookingUpConcurrentStateMachine(t *testing.T) {
+func TestEntryCompression(t *testing.T) {
 	fs := vfs.GetTestFS()
-	tf := func(t *testing.T, nh *NodeHost) {
-		nhc := nh.NodeHostConfig()
-		shardID := 1 + nhc.Expert.Engine.ApplyShards
-		for i := 0; i < 100; i++ {
+	to := &testOption{
+		defaultTestNode: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.EntryCompressionType = config.Snappy
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			cs := nh.GetNoOPSession(1)
 			pto := pto(nh)
 			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			_, err := nh.SyncRead(ctx, shardID, []byte("test"))
-			cancel()
-			if err != sm.ErrSnapshotStopped {
-				t.Fatalf("error not returned")
+			defer cancel()
+			_, err := nh.SyncPropose(ctx, cs, make([]byte, 1024))
+			if err != nil {
+				t.Errorf("make proposal failed %v", err)
 			}
-		}
+			logdb := nh.mu.logdb
+			ents, _, err := logdb.IterateEntries(nil, 0, 1, 1, 1, 100, math.MaxUint64)
+			if err != nil {
+				t.Errorf("failed to get entries %v", err)
+			}
+			hasEncodedEntry := false
+			for _, e := range ents {
+				if e.Type == pb.EncodedEntry {
+					hasEncodedEntry = true
+					payload, err := rsm.GetPayload(e)
+					if err != nil {
+						t.Fatalf("failed to get payload %v", err)
+					}
+					if !bytes.Equal(payload, make([]byte, 1024)) {
+						t.Errorf("payload changed")
+					}
+				}
+			}
+			if !hasEncodedEntry {
+				t.Errorf("failed to locate any encoded entry")
+			}
+		},
 	}
-	singleConcurrentNodeHostTest(t, tf, 10, true, fs)
+	runNodeHostTest(t, to, fs)
 }
 
-func TestRegularStateMachineDoesNotAllowConucrrentUpdate(t *testing.T) {
+func TestOrderedMembershipChange(t *testing.T) {
 	fs := vfs.GetTestFS()
-	failed := uint32(0)
-	tf := func(t *testing.T, nh *NodeHost) {
-		nhi := nh.GetNodeHostInfo(DefaultNodeHostInfoOption)
-		for _, ci := range nhi.ShardInfoList {
-			if ci.ShardID == 1 {
-				if ci.StateMachineType != sm.RegularStateMachine {
-					t.Errorf("unexpected state machine type")
-				}
-			}
-			if ci.IsNonVoting {
-				t.Errorf("unexpected IsNonVoting value")
-			}
-		}
-		stopper := syncutil.NewStopper()
-		pto := pto(nh)
-		stopper.RunWorker(func() {
-			for i := 0; i < 100; i++ {
-				ctx, cancel := context.WithTimeout(context.Background(), pto)
-				session := nh.GetNoOPSession(1)
-				_, err := nh.SyncPropose(ctx, session, []byte("test"))
+	to := &testOption{
+		defaultTestNode: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.OrderedConfigChange = true
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			pto := pto(nh)
+			{
+				ctx, cancel := context.WithTimeout(context.Background(), 2*pto)
+				defer cancel()
+				m, err := nh.SyncGetShardMembership(ctx, 1)
 				if err != nil {
-					plog.Infof("failed to make proposal %v\n", err)
+					t.Fatalf("get membership failed, %v", err)
 				}
-				cancel()
-				if atomic.LoadUint32(&failed) == 1 {
-					return
+				if err := nh.SyncRequestAddReplica(ctx, 1, 2, "localhost:25000", m.ConfigChangeID+1); err == nil {
+					t.Fatalf("unexpectedly completed")
 				}
 			}
-		})
-		stopper.RunWorker(func() {
-			for i := 0; i < 100; i++ {
-				ctx, cancel := context.WithTimeout(context.Background(), pto)
-				result, err := nh.SyncRead(ctx, 1, []byte("test"))
-				cancel()
+			{
+				ctx, cancel := context.WithTimeout(context.Background(), 2*pto)
+				defer cancel()
+				m, err := nh.SyncGetShardMembership(ctx, 1)
 				if err != nil {
-					continue
+					t.Fatalf("get membership failed, %v", err)
 				}
-				v := binary.LittleEndian.Uint32(result.([]byte))
-				if v == 1 {
-					atomic.StoreUint32(&failed, 1)
-					return
+				if err := nh.SyncRequestAddReplica(ctx, 1, 2, "localhost:25000", m.ConfigChangeID); err != nil {
+					t.Fatalf("failed to add node %v", err)
 				}
 			}
-		})
-		stopper.Stop()
-		if atomic.LoadUint32(&failed) == 1 {
-			t.Fatalf("unexpected concurrent update observed")
-		}
-	}
-	singleConcurrentNodeHostTest(t, tf, 0, false, fs)
-}
-
-func TestRegularStateMachineDoesNotAllowConcurrentSaveSnapshot(t *testing.T) {
-	fs := vfs.GetTestFS()
-	tf := func(t *testing.T, nh *NodeHost) {
-		result := make(map[uint64]struct{})
-		session := nh.GetNoOPSession(1)
-		pto := pto(nh)
-		for i := 0; i < 50; i++ {
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			v, err := nh.SyncPropose(ctx, session, []byte("test"))
-			cancel()
-			if err != nil {
-				continue
-			}
-			result[v.Value] = struct{}{}
-			if len(result) > 1 {
-				t.Fatalf("unexpected concurrent save snapshot observed")
-			}
-		}
+		},
 	}
-	singleConcurrentNodeHostTest(t, tf, 10, false, fs)
+	runNodeHostTest(t, to, fs)
 }
 
-func TestLogDBRateLimit(t *testing.T) {
+func TestSyncRequestDeleteReplica(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
 		defaultTestNode: true,
-		updateConfig: func(c *config.Config) *config.Config {
-			c.MaxInMemLogSize = 1024 * 3
-			return c
-		},
-		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
-			logDBConfig := config.GetDefaultLogDBConfig()
-			logDBConfig.KVMaxWriteBufferNumber = 2
-			logDBConfig.KVWriteBufferSize = 1024 * 8
-			c.Expert.LogDB = logDBConfig
-			return c
-		},
 		tf: func(nh *NodeHost) {
-			if nh.mu.logdb.Name() == "Tan" {
-				t.Skip("skipped, using tan logdb")
+			pto := lpto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			defer cancel()
+			err := nh.SyncRequestDeleteReplica(ctx, 1, 2, 0)
+			if err != nil {
+				t.Errorf("failed to delete node %v", err)
 			}
-			for i := 0; i < 10240; i++ {
-				pto := pto(nh)
-				session := nh.GetNoOPSession(1)
-				ctx, cancel := context.WithTimeout(context.Background(), pto)
-				_, err := nh.SyncPropose(ctx, session, make([]byte, 512))
-				cancel()
-				if err == ErrSystemBusy {
-					return
-				}
+			listener, ok := nh.events.sys.ul.(*testSysEventListener)
+			if !ok {
+				t.Fatalf("failed to get the system event listener")
+			}
+			waitNodeInfoEvent(t, listener.getMembershipChanged, 2)
+			ni := listener.getMembershipChanged()[1]
+			if ni.ShardID != 1 || ni.ReplicaID != 1 {
+				t.Fatalf("incorrect membership changed info")
 			}
-			t.Fatalf("failed to return ErrSystemBusy")
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestTooBigPayloadIsRejectedWhenRateLimited(t *testing.T) {
+func TestRequestReplaceReplicaValidatesReplicas(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
-		updateConfig: func(c *config.Config) *config.Config {
-			c.MaxInMemLogSize = 1024 * 3
-			return c
-		},
-		createSM: func(uint64, uint64) sm.IStateMachine {
-			return &tests.NoOP{MillisecondToSleep: 20}
-		},
+		defaultTestNode: true,
 		tf: func(nh *NodeHost) {
-			bigPayload := make([]byte, 1024*1024)
-			session := nh.GetNoOPSession(1)
 			pto := pto(nh)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			_, err := nh.SyncPropose(ctx, session, bigPayload)
-			cancel()
-			if err != ErrPayloadTooBig {
-				t.Errorf("failed to return ErrPayloadTooBig")
+			tests := []struct {
+				oldID uint64
+				newID uint64
+			}{
+				{1, 1},
+				{3, 2},
+			}
+			for idx, tt := range tests {
+				_, err := nh.RequestReplaceReplica(1, tt.oldID, tt.newID,
+					"localhost:25000", 0, pto)
+				if !errors.Is(err, ErrInvalidOperation) {
+					t.Errorf("%d, unexpected error %v", idx, err)
+				}
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestProposalsCanBeMadeWhenRateLimited(t *testing.T) {
+func TestReplaceReplicaKeepsShardInJointConfigUntilNewNodeJoins(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
-		updateConfig: func(c *config.Config) *config.Config {
-			c.MaxInMemLogSize = 1024 * 3
-			return c
-		},
-		createSM: func(uint64, uint64) sm.IStateMachine {
-			return &tests.NoOP{MillisecondToSleep: 20}
-		},
+		defaultTestNode: true,
 		tf: func(nh *NodeHost) {
-			session := nh.GetNoOPSession(1)
-			for i := 0; i < 16; i++ {
-				pto := pto(nh)
-				ctx, cancel := context.WithTimeout(context.Background(), pto)
-				_, err := nh.SyncPropose(ctx, session, make([]byte, 16))
-				cancel()
-				if err == ErrTimeout {
-					continue
+			pto := pto(nh)
+			rs, err := nh.RequestReplaceReplica(1, 1, 2, "localhost:25000", 0, pto)
+			if err != nil {
+				t.Fatalf("failed to request replace %v", err)
+			}
+			defer rs.Release()
+			n, ok := nh.getShard(1)
+			if !ok {
+				t.Fatalf("failed to get shard")
+			}
+			for i := 0; i < 1000; i++ {
+				if n.sm.GetMembership().IsJoint() {
+					break
 				}
-				if err != nil {
-					t.Fatalf("failed to make proposal %v", err)
+				time.Sleep(5 * time.Millisecond)
+			}
+			// the LeaveJoint entry can't be committed without the new node, the
+			// shard keeps both the old and new nodes
+			m := n.sm.GetMembership()
+			if !m.IsJoint() {
+				t.Fatalf("not in joint config")
+			}
+			if _, ok := m.Addresses[2]; !ok || len(m.Addresses) != 1 {
+				t.Errorf("unexpected incoming config %v", m.Addresses)
+			}
+			if _, ok := m.Outgoing[1]; !ok || len(m.Outgoing) != 1 {
+				t.Errorf("unexpected outgoing config %v", m.Outgoing)
+			}
+			if len(m.Removed) != 0 {
+				t.Errorf("unexpected removed nodes %v", m.Removed)
+			}
+			// the request is completed once the joint config is entered
+			select {
+			case r := <-rs.ResultC():
+				if !r.Completed() {
+					t.Errorf("unexpected result %v", r)
 				}
+			case <-time.After(pto):
+				t.Errorf("request not completed")
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func makeTestProposal(nh *NodeHost, count int) bool {
-	session := nh.GetNoOPSession(1)
-	for i := 0; i < count; i++ {
-		pto := pto(nh)
-		ctx, cancel := context.WithTimeout(context.Background(), pto)
-		_, err := nh.SyncPropose(ctx, session, make([]byte, 1024))
-		cancel()
-		if err == nil {
-			return true
+func isLeaveJointBatch(mb pb.MessageBatch) bool {
+	for _, m := range mb.Requests {
+		for _, e := range m.Entries {
+			if e.Type != pb.ConfigChangeEntry {
+				continue
+			}
+			var cc pb.ConfigChange
+			pb.MustUnmarshal(&cc, e.Cmd)
+			if cc.Type == pb.LeaveJoint {
+				return true
+			}
 		}
-		time.Sleep(20 * time.Millisecond)
 	}
 	return false
 }
 
-func TestRateLimitCanBeTriggered(t *testing.T) {
+func TestReplaceReplicaIsCompletedWhenLeaderFailsInJointConfig(t *testing.T) {
 	fs := vfs.GetTestFS()
-	limited := uint32(0)
-	stopper := syncutil.NewStopper()
-	to := &testOption{
-		updateConfig: func(c *config.Config) *config.Config {
-			c.MaxInMemLogSize = 1024 * 3
-			return c
-		},
-		createSM: func(uint64, uint64) sm.IStateMachine {
-			return &tests.NoOP{MillisecondToSleep: 20}
-		},
-		tf: func(nh *NodeHost) {
-			pto := pto(nh)
-			session := nh.GetNoOPSession(1)
-			for i := 0; i < 10; i++ {
-				stopper.RunWorker(func() {
-					for j := 0; j < 16; j++ {
-						if atomic.LoadUint32(&limited) == 1 {
-							return
-						}
-						ctx, cancel := context.WithTimeout(context.Background(), pto)
-						_, err := nh.SyncPropose(ctx, session, make([]byte, 1024))
-						cancel()
-						if err == ErrSystemBusy {
-							atomic.StoreUint32(&limited, 1)
-							return
-						}
-					}
-				})
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		startMemTransportShard(t, nhs[:3], 1)
+		leaderID, _, _, err := nhs[0].GetLeaderID(1)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		leader := nhs[leaderID-1]
+		oldID := leaderID%3 + 1
+		// the leader fails to replicate the LeaveJoint entry
+		tt := leader.transport.(*transport.Transport)
+		tt.SetPreSendBatchHook(func(mb pb.MessageBatch) (pb.MessageBatch, bool) {
+			return mb, !isLeaveJointBatch(mb)
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), pto(leader))
+		err = leader.SyncRequestReplaceReplica(ctx, 1, oldID, 4,
+			memtransport.Address(4), 0)
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to replace replica %v", err)
+		}
+		n, ok := leader.getShard(1)
+		if !ok {
+			t.Fatalf("failed to get shard")
+		}
+		if !n.sm.GetMembership().IsJoint() {
+			t.Fatalf("not in joint config")
+		}
+		// the leader fails before leaving the joint config
+		var others []string
+		for i := 0; i < 4; i++ {
+			if uint64(i+1) != leaderID {
+				others = append(others, memtransport.Address(i+1))
 			}
-			stopper.Stop()
-			if atomic.LoadUint32(&limited) != 1 {
-				t.Fatalf("failed to observe ErrSystemBusy")
+		}
+		network.Partition([]string{memtransport.Address(int(leaderID))}, others)
+		defer network.Heal()
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    4,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
+		}
+		newSM := func(uint64, uint64) sm.IStateMachine {
+			return &PST{}
+		}
+		if err := nhs[3].StartReplica(nil, true, newSM, rc); err != nil {
+			t.Fatalf("failed to start new replica %v", err)
+		}
+		// a newly elected leader leaves the joint config
+		other := nhs[6-leaderID-oldID-1]
+		for i := 0; ; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(other))
+			m, err := other.SyncGetShardMembership(ctx, 1)
+			cancel()
+			if err == nil && len(m.Outgoing) == 0 {
+				_, hasNew := m.Nodes[4]
+				_, hasOld := m.Nodes[oldID]
+				if !hasNew || hasOld || len(m.Nodes) != 3 {
+					t.Fatalf("unexpected membership %+v", m)
+				}
+				break
 			}
-			if makeTestProposal(nh, 10000) {
-				return
+			if i > 100 {
+				t.Fatalf("joint config not left, %v", err)
 			}
-			t.Fatalf("failed to make proposal again")
-		},
+			time.Sleep(100 * time.Millisecond)
+		}
 	}
-	runNodeHostTest(t, to, fs)
+	memTransportNodeHostTest(t, 4, tf, fs)
 }
 
-func TestRateLimitCanUseFollowerFeedback(t *testing.T) {
+func TestReplaceReplicaIsDroppedUntilAllMembersSupportIt(t *testing.T) {
 	fs := vfs.GetTestFS()
-	tf := func(t *testing.T, nh1 *NodeHost, nh2 *NodeHost,
-		n1 *tests.NoOP, n2 *tests.NoOP) {
-		session := nh1.GetNoOPSession(1)
-		limited := false
-		for i := 0; i < 2000; i++ {
-			pto := pto(nh1)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			_, err := nh1.SyncPropose(ctx, session, make([]byte, 1024))
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		startMemTransportShard(t, nhs[:3], 1)
+		leaderID, _, _, err := nhs[0].GetLeaderID(1)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		leader := nhs[leaderID-1]
+		oldID := leaderID%3 + 1
+		olderID := oldID%3 + 1
+		// the remaining follower runs a version that predates joint consensus
+		upgraded := int32(0)
+		older := nhs[olderID-1].transport.(*transport.Transport)
+		older.SetPreSendBatchHook(func(mb pb.MessageBatch) (pb.MessageBatch, bool) {
+			if atomic.LoadInt32(&upgraded) != 0 {
+				return mb, true
+			}
+			for i := range mb.Requests {
+				mb.Requests[i].ProtocolVersion = 0
+			}
+			return mb, true
+		})
+		time.Sleep(500 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), pto(leader))
+		err = leader.SyncRequestReplaceReplica(ctx, 1, oldID, 4,
+			memtransport.Address(4), 0)
+		cancel()
+		if !errors.Is(err, ErrShardNotReady) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		// the follower is upgraded
+		atomic.StoreInt32(&upgraded, 1)
+		for i := 0; ; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(leader))
+			err = leader.SyncRequestReplaceReplica(ctx, 1, oldID, 4,
+				memtransport.Address(4), 0)
 			cancel()
-			if err == ErrShardNotReady {
-				time.Sleep(20 * time.Millisecond)
-			} else if err == ErrSystemBusy {
-				limited = true
+			if err == nil {
 				break
 			}
+			if !errors.Is(err, ErrShardNotReady) || i > 100 {
+				t.Fatalf("failed to replace replica %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
 		}
-		if !limited {
-			t.Fatalf("failed to observe rate limited")
-		}
-		n1.SetSleepTime(0)
-		n2.SetSleepTime(0)
-		if makeTestProposal(nh1, 2000) {
-			plog.Infof("rate limit lifted, all good")
-			return
-		}
-		t.Fatalf("failed to make proposal again")
 	}
-	rateLimitedTwoNodeHostTest(t, tf, fs)
+	memTransportNodeHostTest(t, 4, tf, fs)
 }
 
-func TestUpdateResultIsReturnedToCaller(t *testing.T) {
+func TestSyncRequestAddReplica(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
-		updateConfig: func(c *config.Config) *config.Config {
-			c.MaxInMemLogSize = 1024 * 3
-			return c
-		},
-		createSM: func(uint64, uint64) sm.IStateMachine {
-			return &tests.NoOP{MillisecondToSleep: 20}
-		},
+		defaultTestNode: true,
 		tf: func(nh *NodeHost) {
-			session := nh.GetNoOPSession(1)
 			pto := pto(nh)
 			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			cmd := make([]byte, 1518)
-			_, _ = rand.Read(cmd)
-			result, err := nh.SyncPropose(ctx, session, cmd)
-			cancel()
+			defer cancel()
+			err := nh.SyncRequestAddReplica(ctx, 1, 2, "localhost:25000", 0)
 			if err != nil {
-				t.Errorf("failed to make proposal %v", err)
-			}
-			if result.Value != uint64(1518) {
-				t.Errorf("unexpected result value")
-			}
-			if !bytes.Equal(result.Data, cmd) {
-				t.Errorf("unexpected result data")
+				t.Errorf("failed to add node %v", err)
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestRaftLogQuery(t *testing.T) {
+func TestSyncRequestAddNonVoting(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
 		defaultTestNode: true,
 		tf: func(nh *NodeHost) {
-			for i := 0; i < 10; i++ {
-				makeTestProposal(nh, 10)
+			pto := pto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			defer cancel()
+			err := nh.SyncRequestAddNonVoting(ctx, 1, 2, "localhost:25000", 0)
+			if err != nil {
+				t.Errorf("failed to add nonVoting %v", err)
 			}
-			_, err := nh.QueryRaftLog(1, 2, 1, math.MaxUint64)
-			assert.Equal(t, ErrInvalidRange, err)
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
 
-			rs, err := nh.QueryRaftLog(1, 1, 11, math.MaxUint64)
-			assert.NoError(t, err)
-			ticker := time.NewTicker(2 * time.Second)
-			defer ticker.Stop()
-			select {
-			case v := <-rs.CompletedC:
-				assert.True(t, v.Completed())
-				entries, logRange := v.RaftLogs()
-				assert.Equal(t, 10, len(entries))
-				assert.Equal(t, LogRange{FirstIndex: 1, LastIndex: 13}, logRange)
-			case <-ticker.C:
-				t.Fatalf("no results")
+func TestNodeHostAddReplica(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			pto := pto(nh)
+			rs, err := nh.RequestAddReplica(1, 2, "localhost:25000", 0, pto)
+			if err != nil {
+				t.Errorf("failed to add node %v", err)
 			}
-			rs.Release()
+			v := <-rs.ResultC()
+			if !v.Completed() {
+				t.Errorf("failed to complete add node")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
 
-			// this should be fine
-			rs, err = nh.QueryRaftLog(1, 1, 1000, math.MaxUint64)
-			assert.NoError(t, err)
-			select {
-			case v := <-rs.CompletedC:
-				assert.True(t, v.Completed())
-				entries, logRange := v.RaftLogs()
-				assert.Equal(t, 12, len(entries))
-				assert.Equal(t, LogRange{FirstIndex: 1, LastIndex: 13}, logRange)
-			case <-ticker.C:
-				t.Fatalf("no results")
+func TestNodeHostGetNodeUser(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			n, err := nh.GetNodeUser(1)
+			if err != nil {
+				t.Errorf("failed to get NodeUser")
 			}
-			rs.Release()
+			if n == nil {
+				t.Errorf("got a nil NodeUser")
+			}
+			n, err = nh.GetNodeUser(123)
+			if err != ErrShardNotFound {
+				t.Errorf("didn't return expected err")
+			}
+			if n != nil {
+				t.Errorf("got unexpected node user")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
 
-			// OutOfRange expected
-			rs, err = nh.QueryRaftLog(1, 13, 1000, math.MaxUint64)
-			assert.NoError(t, err)
-			select {
-			case v := <-rs.CompletedC:
-				assert.True(t, v.RequestOutOfRange())
-				entries, logRange := v.RaftLogs()
-				assert.Equal(t, 0, len(entries))
-				assert.Equal(t, LogRange{FirstIndex: 1, LastIndex: 13}, logRange)
-			case <-ticker.C:
-				t.Fatalf("no results")
+func TestNodeHostNodeUserPropose(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			pto := pto(nh)
+			n, err := nh.GetNodeUser(1)
+			if err != nil {
+				t.Errorf("failed to get NodeUser")
 			}
-			rs.Release()
+			cs := nh.GetNoOPSession(1)
+			rs, err := n.Propose(cs, make([]byte, 16), pto)
+			if err != nil {
+				t.Errorf("failed to make propose %v", err)
+			}
+			v := <-rs.ResultC()
+			if !v.Completed() {
+				t.Errorf("failed to complete proposal")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
 
-			// generate a snapshot, a compaction will be requested in the background
-			// then query compacted log will fail.
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
-			opts := SnapshotOption{
-				CompactionIndex:            10,
-				OverrideCompactionOverhead: true,
+func TestNodeHostNodeUserRead(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			pto := pto(nh)
+			n, err := nh.GetNodeUser(1)
+			if err != nil {
+				t.Errorf("failed to get NodeUser")
 			}
-			_, err = nh.SyncRequestSnapshot(ctx, 1, opts)
-			assert.NoError(t, err)
-			done := false
-			for i := 0; i < 1000; i++ {
-				func() {
-					rs, err := nh.QueryRaftLog(1, 1, 11, math.MaxUint64)
-					assert.NoError(t, err)
-					ticker := time.NewTicker(2 * time.Second)
-					defer ticker.Stop()
-					select {
-					case v := <-rs.CompletedC:
-						if v.Completed() {
-							time.Sleep(10 * time.Millisecond)
-							return
-						}
-						assert.True(t, v.RequestOutOfRange())
-						entries, logRange := v.RaftLogs()
-						assert.Equal(t, 0, len(entries))
-						assert.Equal(t, LogRange{FirstIndex: 11, LastIndex: 13}, logRange)
-						done = true
-						return
-					case <-ticker.C:
-						t.Fatalf("no results")
-					}
-					rs.Release()
-				}()
-				if done {
-					return
-				}
-				if i == 999 {
-					t.Fatalf("failed to observe RequestOutOfRange error")
-				}
+			rs, err := n.ReadIndex(pto)
+			if err != nil {
+				t.Errorf("failed to read index %v", err)
+			}
+			v := <-rs.ResultC()
+			if !v.Completed() {
+				t.Errorf("failed to complete read index")
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestIsNonVotingIsReturnedWhenNodeIsNonVoting(t *testing.T) {
+func TestNodeHostAddNonVotingRemoveNode(t *testing.T) {
 	fs := vfs.GetTestFS()
-	tf := func(t *testing.T, nh1 *NodeHost, nh2 *NodeHost) {
-		rc := config.Config{
-			ShardID:                 1,
-			ReplicaID:               1,
-			ElectionRTT:             3,
-			HeartbeatRTT:            1,
-			CheckQuorum:             true,
-			SnapshotEntries:         5,
-			CompactionOverhead:      2,
-			SnapshotCompressionType: config.NoCompression,
-		}
-		newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
-			return tests.NewFakeDiskSM(0)
-		}
-		peers := make(map[uint64]string)
-		peers[1] = nodeHostTestAddr1
-		if err := nh1.StartOnDiskReplica(peers, false, newSM, rc); err != nil {
-			t.Errorf("failed to start nonVoting %v", err)
-		}
-		waitForLeaderToBeElected(t, nh1, 1)
-		rc = config.Config{
-			ShardID:            1,
-			ReplicaID:          2,
-			ElectionRTT:        3,
-			HeartbeatRTT:       1,
-			IsNonVoting:        true,
-			CheckQuorum:        true,
-			SnapshotEntries:    5,
-			CompactionOverhead: 2,
-		}
-		newSM2 := func(uint64, uint64) sm.IOnDiskStateMachine {
-			return tests.NewFakeDiskSM(0)
-		}
-		pto := pto(nh1)
-		rs, err := nh1.RequestAddNonVoting(1, 2, nodeHostTestAddr2, 0, pto)
-		if err != nil {
-			t.Fatalf("failed to add nonVoting %v", err)
-		}
-		<-rs.ResultC()
-		if err := nh2.StartOnDiskReplica(nil, true, newSM2, rc); err != nil {
-			t.Errorf("failed to start nonVoting %v", err)
-		}
-		for i := 0; i < 10000; i++ {
-			nhi := nh2.GetNodeHostInfo(DefaultNodeHostInfoOption)
-			for _, ci := range nhi.ShardInfoList {
-				if ci.Pending {
-					continue
-				}
-				if ci.IsNonVoting && ci.ReplicaID == 2 {
-					return
-				}
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			pto := pto(nh)
+			rs, err := nh.RequestAddNonVoting(1, 2, "localhost:25000", 0, pto)
+			if err != nil {
+				t.Errorf("failed to add node %v", err)
 			}
-			time.Sleep(10 * time.Millisecond)
+			v := <-rs.ResultC()
+			if !v.Completed() {
+				t.Errorf("failed to complete add node")
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			defer cancel()
+			membership, err := nh.SyncGetShardMembership(ctx, 1)
+			if err != nil {
+				t.Fatalf("failed to get shard membership %v", err)
+			}
+			if len(membership.Nodes) != 1 || len(membership.Removed) != 0 {
+				t.Errorf("unexpected nodes/removed len")
+			}
+			if len(membership.NonVotings) != 1 {
+				t.Errorf("unexpected nodes len")
+			}
+			_, ok := membership.NonVotings[2]
+			if !ok {
+				t.Errorf("node 2 not added")
+			}
+			// remove it
+			rs, err = nh.RequestDeleteReplica(1, 2, 0, pto)
+			if err != nil {
+				t.Errorf("failed to remove node %v", err)
+			}
+			v = <-rs.ResultC()
+			if !v.Completed() {
+				t.Errorf("failed to complete remove node")
+			}
+			ctx, cancel = context.WithTimeout(context.Background(), pto)
+			defer cancel()
+			membership, err = nh.SyncGetShardMembership(ctx, 1)
+			if err != nil {
+				t.Fatalf("failed to get shard membership %v", err)
+			}
+			if len(membership.Nodes) != 1 || len(membership.Removed) != 1 {
+				t.Errorf("unexpected nodes/removed len")
+			}
+			if len(membership.NonVotings) != 0 {
+				t.Errorf("unexpected nodes len")
+			}
+			_, ok = membership.Removed[2]
+			if !ok {
+				t.Errorf("node 2 not removed")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+// FIXME:
+// Leadership transfer is not actually tested
+func TestNodeHostLeadershipTransfer(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			if err := nh.RequestLeaderTransfer(1, 1); err != nil {
+				t.Errorf("leader transfer failed %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestNodeHostHasNodeInfo(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			if ok := nh.HasNodeInfo(1, 1); !ok {
+				t.Errorf("node info missing")
+			}
+			if ok := nh.HasNodeInfo(1, 2); ok {
+				t.Errorf("unexpected node info")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestOnDiskStateMachineDoesNotSupportClientSession(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		fakeDiskNode: true,
+		tf: func(nh *NodeHost) {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatalf("no panic when proposing session on disk SM")
+				}
+			}()
+			pto := pto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			_, err := nh.SyncGetSession(ctx, 1)
+			cancel()
+			if err == nil {
+				t.Fatalf("managed to get new session")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestStaleReadOnUninitializedNodeReturnError(t *testing.T) {
+	fs := vfs.GetTestFS()
+	fakeDiskSM := tests.NewFakeDiskSM(0)
+	atomic.StoreUint32(&fakeDiskSM.SlowOpen, 1)
+	to := &testOption{
+		createOnDiskSM: func(uint64, uint64) sm.IOnDiskStateMachine {
+			return fakeDiskSM
+		},
+		tf: func(nh *NodeHost) {
+			n, ok := nh.getShard(1)
+			if !ok {
+				t.Fatalf("failed to get the node")
+			}
+			if n.initialized() {
+				t.Fatalf("node unexpectedly initialized")
+			}
+			if _, err := nh.StaleRead(1, nil); err != ErrShardNotInitialized {
+				t.Fatalf("expected to return ErrShardNotInitialized")
+			}
+			atomic.StoreUint32(&fakeDiskSM.SlowOpen, 0)
+			for !n.initialized() {
+				runtime.Gosched()
+			}
+			v, err := nh.StaleRead(1, nil)
+			if err != nil {
+				t.Fatalf("stale read failed %v", err)
+			}
+			if len(v.([]byte)) != 8 {
+				t.Fatalf("unexpected result %v", v)
+			}
+		},
+		noElection: true,
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestStartReplicaWaitForReadiness(t *testing.T) {
+	fs := vfs.GetTestFS()
+	fakeDiskSM := tests.NewFakeDiskSM(0)
+	atomic.StoreUint32(&fakeDiskSM.SlowOpen, 1)
+	to := &testOption{
+		defaultTestNode: false,
+		noElection:      true,
+		tf: func(nh *NodeHost) {
+			cfg := getTestConfig()
+			cfg.WaitReady = true
+
+			go func() {
+				defer atomic.StoreUint32(&fakeDiskSM.SlowOpen, 0)
+				var n *node
+				var ok bool
+
+				for i := 0; i < 10; i++ {
+					n, ok = nh.getShard(cfg.ShardID)
+					if ok {
+						break
+					}
+					time.Sleep(time.Millisecond * 100)
+				}
+				if !ok {
+					t.Errorf("failed to get the node")
+				}
+				if n.initialized() {
+					t.Errorf("node unexpectedly initialized")
+				}
+				if _, err := nh.StaleRead(1, nil); err != ErrShardNotInitialized {
+					t.Errorf("expected to return ErrShardNotInitialized")
+				}
+			}()
+
+			initialMembers := map[uint64]Target{
+				1: nh.RaftAddress(),
+			}
+
+			err := nh.StartOnDiskReplica(initialMembers, false, func(shardID uint64, replicaID uint64) sm.IOnDiskStateMachine {
+				return fakeDiskSM
+			}, *cfg)
+			if err != nil {
+				t.Fatalf("failed to StartOnDiskReplica: %v", err)
+			}
+
+			v, err := nh.StaleRead(1, nil)
+			if err != nil {
+				t.Fatalf("stale read failed %v", err)
+			}
+			if len(v.([]byte)) != 8 {
+				t.Fatalf("unexpected result %v", v)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func testOnDiskStateMachineCanTakeDummySnapshot(t *testing.T, compressed bool) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		fakeDiskNode: true,
+		compressed:   compressed,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.SnapshotEntries = 30
+			c.CompactionOverhead = 30
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			session := nh.GetNoOPSession(1)
+			logdb := nh.mu.logdb
+			snapshotted := false
+			var ss pb.Snapshot
+			for i := uint64(2); i < 1000; i++ {
+				pto := pto(nh)
+				ctx, cancel := context.WithTimeout(context.Background(), pto)
+				_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
+				cancel()
+				if err != nil {
+					continue
+				}
+				snapshot, err := logdb.GetSnapshot(1, 1)
+				if err != nil {
+					t.Fatalf("list snapshot failed %v", err)
+				}
+				if !pb.IsEmptySnapshot(snapshot) {
+					snapshotted = true
+					ss = snapshot
+					if !ss.Dummy {
+						t.Fatalf("dummy snapshot is not recorded as dummy")
+					}
+					break
+				} else if i%100 == 0 {
+					// this is an ugly hack to workaround RocksDB's incorrect fsync
+					// implementation on macos.
+					// fcntl(fd, F_FULLFSYNC) is required for a proper fsync on macos,
+					// sadly rocksdb is not doing that. this means we can make proposals
+					// very fast as they are not actually fsynced on macos but making
+					// snapshots are going to be much much slower as dragonboat properly
+					// fsyncs its snapshot data. we can end up completing all required
+					// proposals even before completing the first ongoing snapshotting
+					// operation.
+					time.Sleep(200 * time.Millisecond)
+				}
+			}
+			if !snapshotted {
+				t.Fatalf("failed to snapshot")
+			}
+			fi, err := fs.Stat(ss.Filepath)
+			if err != nil {
+				t.Fatalf("failed to get file st %v", err)
+			}
+			if fi.Size() != 1060 {
+				t.Fatalf("unexpected dummy snapshot file size %d", fi.Size())
+			}
+			reader, h, err := rsm.NewSnapshotReader(ss.Filepath, fs)
+			if err != nil {
+				t.Fatalf("failed to read snapshot %v", err)
+			}
+			// dummy snapshot is always not compressed
+			if h.CompressionType != config.NoCompression {
+				t.Errorf("dummy snapshot compressed")
+			}
+			if rsm.SSVersion(h.Version) != rsm.DefaultVersion {
+				t.Errorf("unexpected snapshot version, got %d, want %d",
+					h.Version, rsm.DefaultVersion)
+			}
+			_ = reader.Close()
+			shrunk, err := rsm.IsShrunkSnapshotFile(ss.Filepath, fs)
+			if err != nil {
+				t.Fatalf("failed to check shrunk %v", err)
+			}
+			if !shrunk {
+				t.Errorf("not a dummy snapshot")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestOnDiskStateMachineCanTakeDummySnapshot(t *testing.T) {
+	testOnDiskStateMachineCanTakeDummySnapshot(t, true)
+	testOnDiskStateMachineCanTakeDummySnapshot(t, false)
+}
+
+func TestOnDiskSMCanStreamSnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, nh1 *NodeHost, nh2 *NodeHost) {
+		rc := config.Config{
+			ShardID:                 1,
+			ReplicaID:               1,
+			ElectionRTT:             3,
+			HeartbeatRTT:            1,
+			CheckQuorum:             true,
+			SnapshotEntries:         5,
+			CompactionOverhead:      2,
+			SnapshotCompressionType: config.Snappy,
+			EntryCompressionType:    config.Snappy,
+		}
+		sm1 := tests.NewFakeDiskSM(0)
+		sm1.SetAborted()
+		peers := make(map[uint64]string)
+		peers[1] = nodeHostTestAddr1
+		newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return sm1
+		}
+		if err := nh1.StartOnDiskReplica(peers, false, newSM, rc); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		waitForLeaderToBeElected(t, nh1, 1)
+		logdb := nh1.mu.logdb
+		snapshotted := false
+		session := nh1.GetNoOPSession(1)
+		for i := uint64(2); i < 1000; i++ {
+			pto := pto(nh1)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			_, err := nh1.SyncPropose(ctx, session, []byte("test-data"))
+			cancel()
+			if err != nil {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			snapshot, err := logdb.GetSnapshot(1, 1)
+			if err != nil {
+				t.Fatalf("list snapshot failed %v", err)
+			}
+			if !pb.IsEmptySnapshot(snapshot) {
+				snapshotted = true
+				break
+			} else if i%50 == 0 {
+				// see comments in testOnDiskStateMachineCanTakeDummySnapshot
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		if !snapshotted {
+			t.Fatalf("failed to take 3 snapshots")
+		}
+		pto := pto(nh1)
+		rs, err := nh1.RequestAddReplica(1, 2, nodeHostTestAddr2, 0, pto)
+		if err != nil {
+			t.Fatalf("failed to add node %v", err)
+		}
+		s := <-rs.ResultC()
+		if !s.Completed() {
+			t.Fatalf("failed to complete the add node request")
+		}
+		rc = config.Config{
+			ShardID:            1,
+			ReplicaID:          2,
+			ElectionRTT:        3,
+			HeartbeatRTT:       1,
+			CheckQuorum:        true,
+			SnapshotEntries:    5,
+			CompactionOverhead: 2,
+		}
+		sm2 := tests.NewFakeDiskSM(0)
+		sm2.SetAborted()
+		newSM2 := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return sm2
+		}
+		sm1.ClearAborted()
+		if err := nh2.StartOnDiskReplica(nil, true, newSM2, rc); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		ssIndex := uint64(0)
+		logdb = nh2.mu.logdb
+		waitForLeaderToBeElected(t, nh2, 1)
+		for i := uint64(2); i < 1000; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			_, err := nh2.SyncPropose(ctx, session, []byte("test-data"))
+			cancel()
+			plog.Infof("nh2 proposal result: %v", err)
+			if err != nil {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			ss, err := logdb.GetSnapshot(1, 2)
+			if err != nil {
+				t.Fatalf("list snapshot failed %v", err)
+			}
+			if !pb.IsEmptySnapshot(ss) {
+				if !sm2.Recovered() {
+					t.Fatalf("not recovered")
+				}
+				if !sm1.Aborted() {
+					t.Fatalf("not aborted")
+				}
+				if ss.OnDiskIndex == 0 {
+					t.Errorf("on disk index not recorded in ss")
+				}
+				shrunk, err := rsm.IsShrunkSnapshotFile(ss.Filepath, fs)
+				if err != nil {
+					t.Errorf("failed to check whether snapshot is shrunk %v", err)
+				}
+				if !shrunk {
+					t.Errorf("snapshot %d is not shrunk", ss.Index)
+				}
+				if ssIndex == 0 {
+					ssIndex = ss.Index
+				} else {
+					if ssIndex != ss.Index {
+						break
+					}
+				}
+			} else if i%50 == 0 {
+				// see comments in testOnDiskStateMachineCanTakeDummySnapshot
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		if ssIndex == 0 {
+			t.Fatalf("failed to take 2 snapshots")
+		}
+		listener, ok := nh2.events.sys.ul.(*testSysEventListener)
+		if !ok {
+			t.Fatalf("failed to get the system event listener")
+		}
+		if len(listener.getSnapshotReceiveStarted()) == 0 {
+			t.Fatalf("snapshot receive started not notified")
+		}
+		if len(listener.getSnapshotReceived()) == 0 {
+			t.Fatalf("snapshot received not notified")
+		}
+		if len(listener.getSnapshotRecovered()) == 0 {
+			t.Fatalf("failed to be notified for recovered snapshot")
+		}
+		if len(listener.getLogCompacted()) == 0 {
+			t.Fatalf("log compaction not notified")
+		}
+		listener, ok = nh1.events.sys.ul.(*testSysEventListener)
+		if !ok {
+			t.Fatalf("failed to get the system event listener")
+		}
+		if len(listener.getSendSnapshotStarted()) == 0 {
+			t.Fatalf("send snapshot started not notified")
+		}
+		if len(listener.getSendSnapshotCompleted()) == 0 {
+			t.Fatalf("send snapshot completed not notified")
+		}
+		if listener.getConnectionEstablished() == 0 {
+			t.Fatalf("connection established not notified")
+		}
+	}
+	twoFakeDiskNodeHostTest(t, tf, fs)
+}
+
+func TestConcurrentStateMachineLookup(t *testing.T) {
+	fs := vfs.GetTestFS()
+	done := uint32(0)
+	tf := func(t *testing.T, nh *NodeHost) {
+		nhc := nh.NodeHostConfig()
+		shardID := 1 + nhc.Expert.Engine.ApplyShards
+		count := uint32(0)
+		stopper := syncutil.NewStopper()
+		pto := pto(nh)
+		stopper.RunWorker(func() {
+			for i := 0; i < 10000; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), pto)
+				session := nh.GetNoOPSession(shardID)
+				_, err := nh.SyncPropose(ctx, session, []byte("test"))
+				cancel()
+				if err == ErrTimeout {
+					continue
+				}
+				if err != nil {
+					t.Fatalf("failed to make proposal %v", err)
+				}
+				if atomic.LoadUint32(&count) > 0 {
+					return
+				}
+			}
+		})
+		stopper.RunWorker(func() {
+			for i := 0; i < 10000; i++ {
+				if i%5 == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				rs, err := nh.ReadIndex(shardID, pto)
+				if err != nil {
+					continue
+				}
+				s := <-rs.ResultC()
+				if !s.Completed() {
+					continue
+				}
+				st := random.LockGuardedRand.Uint64()%7 + 1
+				time.Sleep(time.Duration(st) * time.Millisecond)
+				result, err := nh.ReadLocalNode(rs, []byte("test"))
+				if err != nil {
+					continue
+				}
+				v := binary.LittleEndian.Uint32(result.([]byte))
+				if v%2 == 1 {
+					atomic.AddUint32(&count, 1)
+					atomic.StoreUint32(&done, 1)
+					return
+				}
+			}
+		})
+		stopper.Stop()
+		if atomic.LoadUint32(&done) == 0 {
+			t.Fatalf("failed to have any concurrent read")
+		}
+	}
+	singleConcurrentNodeHostTest(t, tf, 0, true, fs)
+}
+
+func TestConcurrentStateMachineSaveSnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, nh *NodeHost) {
+		nhc := nh.NodeHostConfig()
+		shardID := 1 + nhc.Expert.Engine.ApplyShards
+		nhi := nh.GetNodeHostInfo(DefaultNodeHostInfoOption)
+		for _, ci := range nhi.ShardInfoList {
+			if ci.ShardID == shardID {
+				if ci.StateMachineType != sm.ConcurrentStateMachine {
+					t.Errorf("unexpected state machine type")
+				}
+			}
+			if ci.IsNonVoting {
+				t.Errorf("unexpected IsNonVoting value")
+			}
+		}
+		result := make(map[uint64]struct{})
+		session := nh.GetNoOPSession(shardID)
+		pto := pto(nh)
+		for i := 0; i < 10000; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			v, err := nh.SyncPropose(ctx, session, []byte("test"))
+			cancel()
+			if err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+			result[v.Value] = struct{}{}
+			if len(result) > 1 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("failed to make proposal when saving snapshots")
+	}
+	singleConcurrentNodeHostTest(t, tf, 10, true, fs)
+}
+
+func TestErrorCanBeReturnedWhenLookingUpConcurrentStateMachine(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, nh *NodeHost) {
+		nhc := nh.NodeHostConfig()
+		shardID := 1 + nhc.Expert.Engine.ApplyShards
+		for i := 0; i < 100; i++ {
+			pto := pto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			_, err := nh.SyncRead(ctx, shardID, []byte("test"))
+			cancel()
+			if err != sm.ErrSnapshotStopped {
+				t.Fatalf("error not returned")
+			}
+		}
+	}
+	singleConcurrentNodeHostTest(t, tf, 10, true, fs)
+}
+
+func TestRegularStateMachineDoesNotAllowConucrrentUpdate(t *testing.T) {
+	fs := vfs.GetTestFS()
+	failed := uint32(0)
+	tf := func(t *testing.T, nh *NodeHost) {
+		nhi := nh.GetNodeHostInfo(DefaultNodeHostInfoOption)
+		for _, ci := range nhi.ShardInfoList {
+			if ci.ShardID == 1 {
+				if ci.StateMachineType != sm.RegularStateMachine {
+					t.Errorf("unexpected state machine type")
+				}
+			}
+			if ci.IsNonVoting {
+				t.Errorf("unexpected IsNonVoting value")
+			}
+		}
+		stopper := syncutil.NewStopper()
+		pto := pto(nh)
+		stopper.RunWorker(func() {
+			for i := 0; i < 100; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), pto)
+				session := nh.GetNoOPSession(1)
+				_, err := nh.SyncPropose(ctx, session, []byte("test"))
+				if err != nil {
+					plog.Infof("failed to make proposal %v\n", err)
+				}
+				cancel()
+				if atomic.LoadUint32(&failed) == 1 {
+					return
+				}
+			}
+		})
+		stopper.RunWorker(func() {
+			for i := 0; i < 100; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), pto)
+				result, err := nh.SyncRead(ctx, 1, []byte("test"))
+				cancel()
+				if err != nil {
+					continue
+				}
+				v := binary.LittleEndian.Uint32(result.([]byte))
+				if v == 1 {
+					atomic.StoreUint32(&failed, 1)
+					return
+				}
+			}
+		})
+		stopper.Stop()
+		if atomic.LoadUint32(&failed) == 1 {
+			t.Fatalf("unexpected concurrent update observed")
+		}
+	}
+	singleConcurrentNodeHostTest(t, tf, 0, false, fs)
+}
+
+func TestRegularStateMachineDoesNotAllowConcurrentSaveSnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, nh *NodeHost) {
+		result := make(map[uint64]struct{})
+		session := nh.GetNoOPSession(1)
+		pto := pto(nh)
+		for i := 0; i < 50; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			v, err := nh.SyncPropose(ctx, session, []byte("test"))
+			cancel()
+			if err != nil {
+				continue
+			}
+			result[v.Value] = struct{}{}
+			if len(result) > 1 {
+				t.Fatalf("unexpected concurrent save snapshot observed")
+			}
+		}
+	}
+	singleConcurrentNodeHostTest(t, tf, 10, false, fs)
+}
+
+func TestLogDBRateLimit(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.MaxInMemLogSize = 1024 * 3
+			return c
+		},
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			logDBConfig := config.GetDefaultLogDBConfig()
+			logDBConfig.KVMaxWriteBufferNumber = 2
+			logDBConfig.KVWriteBufferSize = 1024 * 8
+			c.Expert.LogDB = logDBConfig
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			if nh.mu.logdb.Name() == "Tan" {
+				t.Skip("skipped, using tan logdb")
+			}
+			for i := 0; i < 10240; i++ {
+				pto := pto(nh)
+				session := nh.GetNoOPSession(1)
+				ctx, cancel := context.WithTimeout(context.Background(), pto)
+				_, err := nh.SyncPropose(ctx, session, make([]byte, 512))
+				cancel()
+				if err == ErrSystemBusy {
+					return
+				}
+			}
+			t.Fatalf("failed to return ErrSystemBusy")
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestTooBigPayloadIsRejectedWhenRateLimited(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		updateConfig: func(c *config.Config) *config.Config {
+			c.MaxInMemLogSize = 1024 * 3
+			return c
+		},
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &tests.NoOP{MillisecondToSleep: 20}
+		},
+		tf: func(nh *NodeHost) {
+			bigPayload := make([]byte, 1024*1024)
+			session := nh.GetNoOPSession(1)
+			pto := pto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			_, err := nh.SyncPropose(ctx, session, bigPayload)
+			cancel()
+			if err != ErrPayloadTooBig {
+				t.Errorf("failed to return ErrPayloadTooBig")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestProposalsCanBeMadeWhenRateLimited(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		updateConfig: func(c *config.Config) *config.Config {
+			c.MaxInMemLogSize = 1024 * 3
+			return c
+		},
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &tests.NoOP{MillisecondToSleep: 20}
+		},
+		tf: func(nh *NodeHost) {
+			session := nh.GetNoOPSession(1)
+			for i := 0; i < 16; i++ {
+				pto := pto(nh)
+				ctx, cancel := context.WithTimeout(context.Background(), pto)
+				_, err := nh.SyncPropose(ctx, session, make([]byte, 16))
+				cancel()
+				if err == ErrTimeout {
+					continue
+				}
+				if err != nil {
+					t.Fatalf("failed to make proposal %v", err)
+				}
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func makeTestProposal(nh *NodeHost, count int) bool {
+	session := nh.GetNoOPSession(1)
+	for i := 0; i < count; i++ {
+		pto := pto(nh)
+		ctx, cancel := context.WithTimeout(context.Background(), pto)
+		_, err := nh.SyncPropose(ctx, session, make([]byte, 1024))
+		cancel()
+		if err == nil {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func TestRateLimitCanBeTriggered(t *testing.T) {
+	fs := vfs.GetTestFS()
+	limited := uint32(0)
+	stopper := syncutil.NewStopper()
+	to := &testOption{
+		updateConfig: func(c *config.Config) *config.Config {
+			c.MaxInMemLogSize = 1024 * 3
+			return c
+		},
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &tests.NoOP{MillisecondToSleep: 20}
+		},
+		tf: func(nh *NodeHost) {
+			pto := pto(nh)
+			session := nh.GetNoOPSession(1)
+			for i := 0; i < 10; i++ {
+				stopper.RunWorker(func() {
+					for j := 0; j < 16; j++ {
+						if atomic.LoadUint32(&limited) == 1 {
+							return
+						}
+						ctx, cancel := context.WithTimeout(context.Background(), pto)
+						_, err := nh.SyncPropose(ctx, session, make([]byte, 1024))
+						cancel()
+						if err == ErrSystemBusy {
+							atomic.StoreUint32(&limited, 1)
+							return
+						}
+					}
+				})
+			}
+			stopper.Stop()
+			if atomic.LoadUint32(&limited) != 1 {
+				t.Fatalf("failed to observe ErrSystemBusy")
+			}
+			if makeTestProposal(nh, 10000) {
+				return
+			}
+			t.Fatalf("failed to make proposal again")
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestRateLimitCanUseFollowerFeedback(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, nh1 *NodeHost, nh2 *NodeHost,
+		n1 *tests.NoOP, n2 *tests.NoOP) {
+		session := nh1.GetNoOPSession(1)
+		limited := false
+		for i := 0; i < 2000; i++ {
+			pto := pto(nh1)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			_, err := nh1.SyncPropose(ctx, session, make([]byte, 1024))
+			cancel()
+			if err == ErrShardNotReady {
+				time.Sleep(20 * time.Millisecond)
+			} else if err == ErrSystemBusy {
+				limited = true
+				break
+			}
+		}
+		if !limited {
+			t.Fatalf("failed to observe rate limited")
+		}
+		n1.SetSleepTime(0)
+		n2.SetSleepTime(0)
+		if makeTestProposal(nh1, 2000) {
+			plog.Infof("rate limit lifted, all good")
+			return
+		}
+		t.Fatalf("failed to make proposal again")
+	}
+	rateLimitedTwoNodeHostTest(t, tf, fs)
+}
+
+func TestProposalsAreHeldBackByProposalBatching(t *testing.T) {
+	fs := vfs.GetTestFS()
+	delay := 100 * time.Millisecond
+	to := &testOption{
+		defaultTestNode: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.Expert.Engine.ProposalBatchDelayMicroseconds =
+				uint64(delay / time.Microsecond)
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			session := nh.GetNoOPSession(1)
+			start := time.Now()
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
+			cancel()
+			if err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+			if elapsed := time.Since(start); elapsed < delay {
+				t.Errorf("proposal not held back, %v", elapsed)
+			}
+			ctx, cancel = context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			if err := nh.SyncRequestAddNonVoting(ctx,
+				1, 2, "localhost:25000", 0); err != nil {
+				t.Fatalf("failed to add non-voting %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestUpdateResultIsReturnedToCaller(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		updateConfig: func(c *config.Config) *config.Config {
+			c.MaxInMemLogSize = 1024 * 3
+			return c
+		},
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &tests.NoOP{MillisecondToSleep: 20}
+		},
+		tf: func(nh *NodeHost) {
+			session := nh.GetNoOPSession(1)
+			pto := pto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			cmd := make([]byte, 1518)
+			_, _ = rand.Read(cmd)
+			result, err := nh.SyncPropose(ctx, session, cmd)
+			cancel()
+			if err != nil {
+				t.Errorf("failed to make proposal %v", err)
+			}
+			if result.Value != uint64(1518) {
+				t.Errorf("unexpected result value")
+			}
+			if !bytes.Equal(result.Data, cmd) {
+				t.Errorf("unexpected result data")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestRaftLogQuery(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			for i := 0; i < 10; i++ {
+				makeTestProposal(nh, 10)
+			}
+			_, err := nh.QueryRaftLog(1, 2, 1, math.MaxUint64)
+			assert.Equal(t, ErrInvalidRange, err)
+
+			rs, err := nh.QueryRaftLog(1, 1, 11, math.MaxUint64)
+			assert.NoError(t, err)
+			ticker := time.NewTicker(2 * time.Second)
+			defer ticker.Stop()
+			select {
+			case v := <-rs.CompletedC:
+				assert.True(t, v.Completed())
+				entries, logRange := v.RaftLogs()
+				assert.Equal(t, 10, len(entries))
+				assert.Equal(t, LogRange{FirstIndex: 1, LastIndex: 13}, logRange)
+			case <-ticker.C:
+				t.Fatalf("no results")
+			}
+			rs.Release()
+
+			// this should be fine
+			rs, err = nh.QueryRaftLog(1, 1, 1000, math.MaxUint64)
+			assert.NoError(t, err)
+			select {
+			case v := <-rs.CompletedC:
+				assert.True(t, v.Completed())
+				entries, logRange := v.RaftLogs()
+				assert.Equal(t, 12, len(entries))
+				assert.Equal(t, LogRange{FirstIndex: 1, LastIndex: 13}, logRange)
+			case <-ticker.C:
+				t.Fatalf("no results")
+			}
+			rs.Release()
+
+			// OutOfRange expected
+			rs, err = nh.QueryRaftLog(1, 13, 1000, math.MaxUint64)
+			assert.NoError(t, err)
+			select {
+			case v := <-rs.CompletedC:
+				assert.True(t, v.RequestOutOfRange())
+				entries, logRange := v.RaftLogs()
+				assert.Equal(t, 0, len(entries))
+				assert.Equal(t, LogRange{FirstIndex: 1, LastIndex: 13}, logRange)
+			case <-ticker.C:
+				t.Fatalf("no results")
+			}
+			rs.Release()
+
+			// generate a snapshot, a compaction will be requested in the background
+			// then query compacted log will fail.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			opts := SnapshotOption{
+				CompactionIndex:            10,
+				OverrideCompactionOverhead: true,
+			}
+			_, err = nh.SyncRequestSnapshot(ctx, 1, opts)
+			assert.NoError(t, err)
+			done := false
+			for i := 0; i < 1000; i++ {
+				func() {
+					rs, err := nh.QueryRaftLog(1, 1, 11, math.MaxUint64)
+					assert.NoError(t, err)
+					ticker := time.NewTicker(2 * time.Second)
+					defer ticker.Stop()
+					select {
+					case v := <-rs.CompletedC:
+						if v.Completed() {
+							time.Sleep(10 * time.Millisecond)
+							return
+						}
+						assert.True(t, v.RequestOutOfRange())
+						entries, logRange := v.RaftLogs()
+						assert.Equal(t, 0, len(entries))
+						assert.Equal(t, LogRange{FirstIndex: 11, LastIndex: 13}, logRange)
+						done = true
+						return
+					case <-ticker.C:
+						t.Fatalf("no results")
+					}
+					rs.Release()
+				}()
+				if done {
+					return
+				}
+				if i == 999 {
+					t.Fatalf("failed to observe RequestOutOfRange error")
+				}
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestIsNonVotingIsReturnedWhenNodeIsNonVoting(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, nh1 *NodeHost, nh2 *NodeHost) {
+		rc := config.Config{
+			ShardID:                 1,
+			ReplicaID:               1,
+			ElectionRTT:             3,
+			HeartbeatRTT:            1,
+			CheckQuorum:             true,
+			SnapshotEntries:         5,
+			CompactionOverhead:      2,
+			SnapshotCompressionType: config.NoCompression,
+		}
+		newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return tests.NewFakeDiskSM(0)
+		}
+		peers := make(map[uint64]string)
+		peers[1] = nodeHostTestAddr1
+		if err := nh1.StartOnDiskReplica(peers, false, newSM, rc); err != nil {
+			t.Errorf("failed to start nonVoting %v", err)
+		}
+		waitForLeaderToBeElected(t, nh1, 1)
+		rc = config.Config{
+			ShardID:            1,
+			ReplicaID:          2,
+			ElectionRTT:        3,
+			HeartbeatRTT:       1,
+			IsNonVoting:        true,
+			CheckQuorum:        true,
+			SnapshotEntries:    5,
+			CompactionOverhead: 2,
+		}
+		newSM2 := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return tests.NewFakeDiskSM(0)
+		}
+		pto := pto(nh1)
+		rs, err := nh1.RequestAddNonVoting(1, 2, nodeHostTestAddr2, 0, pto)
+		if err != nil {
+			t.Fatalf("failed to add nonVoting %v", err)
+		}
+		<-rs.ResultC()
+		if err := nh2.StartOnDiskReplica(nil, true, newSM2, rc); err != nil {
+			t.Errorf("failed to start nonVoting %v", err)
+		}
+		for i := 0; i < 10000; i++ {
+			nhi := nh2.GetNodeHostInfo(DefaultNodeHostInfoOption)
+			for _, ci := range nhi.ShardInfoList {
+				if ci.Pending {
+					continue
+				}
+				if ci.IsNonVoting && ci.ReplicaID == 2 {
+					return
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("failed to get is nonVoting flag")
+	}
+	twoFakeDiskNodeHostTest(t, tf, fs)
+}
+
+func TestSnapshotIndexWillPanicOnRegularRequestResult(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			cs := nh.GetNoOPSession(1)
+			pto := pto(nh)
+			rs, err := nh.Propose(cs, make([]byte, 1), pto)
+			if err != nil {
+				t.Fatalf("propose failed %v", err)
+			}
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatalf("no panic")
+				}
+			}()
+			v := <-rs.ResultC()
+			plog.Infof("%d", v.SnapshotIndex())
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestSyncRequestSnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			session := nh.GetNoOPSession(1)
+			pto := lpto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			cmd := make([]byte, 1518)
+			_, err := nh.SyncPropose(ctx, session, cmd)
+			cancel()
+			if err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+			ctx, cancel = context.WithTimeout(context.Background(), pto)
+			idx, err := nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption)
+			cancel()
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if idx == 0 {
+				t.Errorf("unexpected index %d", idx)
+			}
+			listener, ok := nh.events.sys.ul.(*testSysEventListener)
+			if !ok {
+				t.Fatalf("failed to get the system event listener")
+			}
+			waitSnapshotInfoEvent(t, listener.getSnapshotCreated, 1)
+			si := listener.getSnapshotCreated()[0]
+			if si.ShardID != 1 || si.ReplicaID != 1 {
+				t.Fatalf("incorrect created snapshot info")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestSnapshotCanBeExportedAfterSnapshotting(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			session := nh.GetNoOPSession(1)
+			pto := lpto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			cmd := make([]byte, 1518)
+			_, err := nh.SyncPropose(ctx, session, cmd)
+			cancel()
+			if err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+			ctx, cancel = context.WithTimeout(context.Background(), pto)
+			idx, err := nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption)
+			cancel()
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if idx == 0 {
+				t.Errorf("unexpected index %d", idx)
+			}
+			sspath := "exported_snapshot_safe_to_delete"
+			if err := fs.RemoveAll(sspath); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if err := fs.MkdirAll(sspath, 0755); err != nil {
+				t.Fatalf("%v", err)
+			}
+			defer func() {
+				if err := fs.RemoveAll(sspath); err != nil {
+					t.Fatalf("%v", err)
+				}
+			}()
+			opt := SnapshotOption{
+				Exported:   true,
+				ExportPath: sspath,
+			}
+			ctx, cancel = context.WithTimeout(context.Background(), pto)
+			exportIdx, err := nh.SyncRequestSnapshot(ctx, 1, opt)
+			cancel()
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if exportIdx != idx {
+				t.Errorf("unexpected index %d, want %d", exportIdx, idx)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestCanOverrideSnapshotOverhead(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			session := nh.GetNoOPSession(1)
+			cmd := make([]byte, 1)
+			pto := pto(nh)
+			for i := 0; i < 16; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), pto)
+				_, err := nh.SyncPropose(ctx, session, cmd)
+				cancel()
+				if err != nil {
+					// see comments in testOnDiskStateMachineCanTakeDummySnapshot
+					if err == ErrTimeout {
+						time.Sleep(500 * time.Millisecond)
+						continue
+					}
+					t.Fatalf("failed to make proposal %v", err)
+				}
+			}
+			opt := SnapshotOption{
+				OverrideCompactionOverhead: true,
+				CompactionOverhead:         0,
+			}
+			lpto := lpto(nh)
+			sr, err := nh.RequestSnapshot(1, opt, lpto)
+			if err != nil {
+				t.Fatalf("failed to request snapshot")
+			}
+			v := <-sr.ResultC()
+			if !v.Completed() {
+				t.Errorf("failed to complete the requested snapshot")
+			}
+			if v.SnapshotIndex() < 16 {
+				t.Fatalf("unexpected snapshot index %d", v.SnapshotIndex())
+			}
+			logdb := nh.mu.logdb
+			for i := 0; i < 1000; i++ {
+				if i == 999 {
+					t.Fatalf("failed to compact the entries")
+				}
+				time.Sleep(10 * time.Millisecond)
+				op, err := nh.RequestCompaction(1, 1)
+				if err == nil {
+					<-op.ResultC()
+				}
+				ents, _, err := logdb.IterateEntries(nil, 0, 1, 1, 12, 14, math.MaxUint64)
+				if err != nil {
+					t.Fatalf("failed to iterate entries, %v", err)
+				}
+				if len(ents) != 0 {
+					continue
+				} else {
+					return
+				}
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestSnapshotCanBeRequested(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			pto := lpto(nh)
+			session := nh.GetNoOPSession(1)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			cmd := make([]byte, 1518)
+			_, err := nh.SyncPropose(ctx, session, cmd)
+			cancel()
+			if err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+			sr, err := nh.RequestSnapshot(1, SnapshotOption{}, pto)
+			if err != nil {
+				t.Errorf("failed to request snapshot")
+			}
+			var index uint64
+			v := <-sr.ResultC()
+			if !v.Completed() {
+				t.Errorf("failed to complete the requested snapshot")
+			}
+			index = v.SnapshotIndex()
+			sr, err = nh.RequestSnapshot(1, SnapshotOption{}, pto)
+			if err != nil {
+				t.Fatalf("failed to request snapshot")
+			}
+			v = <-sr.ResultC()
+			if !v.Rejected() {
+				t.Errorf("failed to complete the requested snapshot")
+			}
+			logdb := nh.mu.logdb
+			snapshot, err := logdb.GetSnapshot(1, 1)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if pb.IsEmptySnapshot(snapshot) {
+				t.Fatalf("failed to save snapshots")
+			}
+			if snapshot.Index != index {
+				t.Errorf("unexpected index value")
+			}
+			reader, header, err := rsm.NewSnapshotReader(snapshot.Filepath, fs)
+			if err != nil {
+				t.Fatalf("failed to new snapshot reader %v", err)
+			}
+			defer reader.Close()
+			if rsm.SSVersion(header.Version) != rsm.V2 {
+				t.Errorf("unexpected snapshot version")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestClientCanBeNotifiedOnCommittedConfigChange(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.NotifyCommit = true
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			pto := pto(nh)
+			rs, err := nh.RequestAddReplica(1, 2, "localhost:3456", 0, pto)
+			if err != nil {
+				t.Fatalf("failed to request add node")
+			}
+			if rs.committedC == nil {
+				t.Fatalf("committedC not set")
+			}
+			cn := <-rs.ResultC()
+			if !cn.Committed() {
+				t.Fatalf("failed to get committed notification")
+			}
+			cn = <-rs.ResultC()
+			if !cn.Completed() {
+				t.Fatalf("failed to get completed notification")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestClientCanBeNotifiedOnCommittedProposals(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.NotifyCommit = true
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			pto := pto(nh)
+			cmd := make([]byte, 128)
+			session := nh.GetNoOPSession(1)
+			rs, err := nh.Propose(session, cmd, pto)
+			if err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+			if rs.committedC == nil {
+				t.Fatalf("committedC not set")
+			}
+			cn := <-rs.ResultC()
+			if !cn.Committed() {
+				t.Fatalf("failed to get committed notification")
+			}
+			cn = <-rs.ResultC()
+			if !cn.Completed() {
+				t.Fatalf("failed to get completed notification")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestRequestSnapshotTimeoutWillBeReported(t *testing.T) {
+	fs := vfs.GetTestFS()
+	pst := &PST{slowSave: true}
+	to := &testOption{
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return pst
+		},
+		tf: func(nh *NodeHost) {
+			pto := pto(nh)
+			sr, err := nh.RequestSnapshot(1, SnapshotOption{}, pto)
+			if err != nil {
+				t.Fatalf("failed to request snapshot")
+			}
+			v := <-sr.ResultC()
+			if !v.Timeout() {
+				t.Errorf("failed to report timeout")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestSyncRemoveData(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			if err := nh.StopShard(1); err != nil {
+				t.Fatalf("failed to remove shard %v", err)
+			}
+			pto := lpto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			defer cancel()
+			if err := nh.SyncRemoveData(ctx, 1, 1); err != nil {
+				t.Fatalf("sync remove data failed: %v", err)
+			}
+			listener, ok := nh.events.sys.ul.(*testSysEventListener)
+			if !ok {
+				t.Fatalf("failed to get the system event listener")
+			}
+			waitNodeInfoEvent(t, listener.getNodeUnloaded, 1)
+			ni := listener.getNodeUnloaded()[0]
+			if ni.ShardID != 1 || ni.ReplicaID != 1 {
+				t.Fatalf("incorrect node unloaded info")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestRemoveNodeDataWillFailWhenNodeIsStillRunning(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			if err := nh.RemoveData(1, 1); err != ErrShardNotStopped {
+				t.Errorf("remove data didn't fail")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestRestartingAnNodeWithRemovedDataWillBeRejected(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			if err := nh.StopShard(1); err != nil {
+				t.Fatalf("failed to remove shard %v", err)
+			}
+			for {
+				if err := nh.RemoveData(1, 1); err != nil {
+					if err == ErrShardNotStopped {
+						time.Sleep(100 * time.Millisecond)
+						continue
+					} else {
+						t.Errorf("remove data failed %v", err)
+					}
+				}
+				break
+			}
+			rc := getTestConfig()
+			peers := make(map[uint64]string)
+			peers[1] = nh.RaftAddress()
+			newPST := func(shardID uint64, replicaID uint64) sm.IStateMachine {
+				return &PST{}
+			}
+			if err := nh.StartReplica(peers, false, newPST, *rc); err != ErrReplicaRemoved {
+				t.Errorf("start shard failed %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestRemoveNodeDataRemovesAllNodeData(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			session := nh.GetNoOPSession(1)
+			pto := lpto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			cmd := make([]byte, 1518)
+			_, err := nh.SyncPropose(ctx, session, cmd)
+			cancel()
+			if err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+			sr, err := nh.RequestSnapshot(1, SnapshotOption{}, pto)
+			if err != nil {
+				t.Errorf("failed to request snapshot")
+			}
+			v := <-sr.ResultC()
+			if !v.Completed() {
+				t.Errorf("failed to complete the requested snapshot")
+			}
+			if err := nh.StopShard(1); err != nil {
+				t.Fatalf("failed to stop shard %v", err)
+			}
+			logdb := nh.mu.logdb
+			snapshot, err := logdb.GetSnapshot(1, 1)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if pb.IsEmptySnapshot(snapshot) {
+				t.Fatalf("failed to save snapshots")
+			}
+			snapshotDir := nh.env.GetSnapshotDir(nh.nhConfig.GetDeploymentID(), 1, 1)
+			exist, err := fileutil.Exist(snapshotDir, fs)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if !exist {
+				t.Fatalf("snapshot dir %s does not exist", snapshotDir)
+			}
+			files, err := fs.List(snapshotDir)
+			if err != nil {
+				t.Fatalf("failed to read dir %v", err)
+			}
+			sscount := 0
+			for _, fn := range files {
+				fi, err := fs.Stat(fs.PathJoin(snapshotDir, fn))
+				if err != nil {
+					t.Fatalf("failed to get stat for %s", fn)
+				}
+				if !fi.IsDir() {
+					continue
+				}
+				if server.SnapshotDirNameRe.Match([]byte(fi.Name())) {
+					sscount++
+				}
+			}
+			if sscount == 0 {
+				t.Fatalf("no snapshot dir found")
+			}
+			removed := false
+			for i := 0; i < 1000; i++ {
+				err := nh.RemoveData(1, 1)
+				if err == ErrShardNotStopped {
+					time.Sleep(100 * time.Millisecond)
+					continue
+				}
+				if err != nil {
+					t.Fatalf("failed to remove data %v", err)
+				}
+				if err == nil {
+					removed = true
+					break
+				}
+			}
+			if !removed {
+				t.Fatalf("failed to remove node data")
+			}
+			marked, err := fileutil.IsDirMarkedAsDeleted(snapshotDir, fs)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if !marked {
+				t.Fatalf("snapshot dir %s still exist", snapshotDir)
+			}
+			files, err = fs.List(snapshotDir)
+			if err != nil {
+				t.Fatalf("failed to read dir %v", err)
+			}
+			for _, fn := range files {
+				fi, err := fs.Stat(fs.PathJoin(snapshotDir, fn))
+				if err != nil {
+					t.Fatalf("failed to get stat for %s", fn)
+				}
+				if !fi.IsDir() {
+					continue
+				}
+				if server.SnapshotDirNameRe.Match([]byte(fi.Name())) {
+					t.Fatalf("failed to delete the snapshot dir %s", fi.Name())
+				}
+			}
+			bs, err := logdb.GetBootstrapInfo(1, 1)
+			if !errors.Is(err, raftio.ErrNoBootstrapInfo) {
+				t.Fatalf("failed to delete bootstrap %v", err)
+			}
+			if !reflect.DeepEqual(bs, pb.Bootstrap{}) {
+				t.Fatalf("bs not nil")
+			}
+			ents, sz, err := logdb.IterateEntries(nil, 0, 1, 1, 0,
+				math.MaxUint64, math.MaxUint64)
+			if err != nil {
+				t.Fatalf("failed to get entries %v", err)
+			}
+			if len(ents) != 0 || sz != 0 {
+				t.Fatalf("entry returned")
+			}
+			snapshot, err = logdb.GetSnapshot(1, 1)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if !pb.IsEmptySnapshot(snapshot) {
+				t.Fatalf("snapshot not deleted")
+			}
+			_, err = logdb.ReadRaftState(1, 1, 1)
+			if !errors.Is(err, raftio.ErrNoSavedLog) {
+				t.Fatalf("raft state not deleted %v", err)
+			}
+			sysop, err := nh.RequestCompaction(1, 1)
+			if err != nil {
+				t.Fatalf("failed to request compaction %v", err)
+			}
+			<-sysop.ResultC()
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestSnapshotOptionIsChecked(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			opts := SnapshotOption{
+				OverrideCompactionOverhead: true,
+				CompactionIndex:            100,
+				CompactionOverhead:         10,
+			}
+			assert.Equal(t, ErrInvalidOption, opts.Validate())
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, err := nh.SyncRequestSnapshot(ctx, 1, opts)
+			assert.Equal(t, ErrInvalidOption, err)
+			rs, err := nh.RequestSnapshot(1, opts, time.Second)
+			assert.Equal(t, ErrInvalidOption, err)
+			assert.Nil(t, rs)
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestSnapshotCanBeExported(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			sspath := "exported_snapshot_safe_to_delete"
+			if err := fs.RemoveAll(sspath); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if err := fs.MkdirAll(sspath, 0755); err != nil {
+				t.Fatalf("%v", err)
+			}
+			defer func() {
+				if err := fs.RemoveAll(sspath); err != nil {
+					t.Fatalf("%v", err)
+				}
+			}()
+			session := nh.GetNoOPSession(1)
+			pto := lpto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			cmd := make([]byte, 1518)
+			_, err := nh.SyncPropose(ctx, session, cmd)
+			cancel()
+			if err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+			opt := SnapshotOption{
+				Exported:   true,
+				ExportPath: sspath,
+			}
+			sr, err := nh.RequestSnapshot(1, opt, pto)
+			if err != nil {
+				t.Errorf("failed to request snapshot")
+			}
+			var index uint64
+			v := <-sr.ResultC()
+			if !v.Completed() {
+				t.Fatalf("failed to complete the requested snapshot")
+			}
+			index = v.SnapshotIndex()
+			logdb := nh.mu.logdb
+			snapshot, err := logdb.GetSnapshot(1, 1)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			// exported snapshot is not managed by the system
+			if !pb.IsEmptySnapshot(snapshot) {
+				t.Fatalf("snapshot record unexpectedly inserted into the system")
+			}
+			snapshotDir := fmt.Sprintf("snapshot-%016X", index)
+			snapshotFile := fmt.Sprintf("snapshot-%016X.gbsnap", index)
+			fp := fs.PathJoin(sspath, snapshotDir, snapshotFile)
+			exist, err := fileutil.Exist(fp, fs)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if !exist {
+				t.Errorf("snapshot file not saved")
+			}
+			metafp := fs.PathJoin(sspath, snapshotDir, "snapshot.metadata")
+			exist, err = fileutil.Exist(metafp, fs)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if !exist {
+				t.Errorf("snapshot metadata not saved")
+			}
+			var ss pb.Snapshot
+			if err := fileutil.GetFlagFileContent(fs.PathJoin(sspath, snapshotDir),
+				"snapshot.metadata", &ss, fs); err != nil {
+				t.Fatalf("failed to get snapshot from its metadata file")
+			}
+			if ss.OnDiskIndex != 0 {
+				t.Errorf("on disk index is not 0")
+			}
+			if ss.Imported {
+				t.Errorf("incorrectly recorded as imported")
+			}
+			if ss.Type != pb.RegularStateMachine {
+				t.Errorf("incorrect type")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestOnDiskStateMachineCanExportSnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		fakeDiskNode: true,
+		tf: func(nh *NodeHost) {
+			session := nh.GetNoOPSession(1)
+			proposed := false
+			for i := 0; i < 16; i++ {
+				pto := pto(nh)
+				ctx, cancel := context.WithTimeout(context.Background(), pto)
+				_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
+				cancel()
+				if err == nil {
+					proposed = true
+					break
+				} else {
+					time.Sleep(100 * time.Millisecond)
+				}
+			}
+			if !proposed {
+				t.Fatalf("failed to make proposal")
+			}
+			sspath := "exported_snapshot_safe_to_delete"
+			if err := fs.RemoveAll(sspath); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if err := fs.MkdirAll(sspath, 0755); err != nil {
+				t.Fatalf("%v", err)
+			}
+			defer func() {
+				if err := fs.RemoveAll(sspath); err != nil {
+					t.Fatalf("%v", err)
+				}
+			}()
+			opt := SnapshotOption{
+				Exported:   true,
+				ExportPath: sspath,
+			}
+			aborted := false
+			index := uint64(0)
+			pto := lpto(nh)
+			for {
+				sr, err := nh.RequestSnapshot(1, opt, pto)
+				if err == ErrRejected {
+					continue
+				}
+				if err != nil {
+					t.Fatalf("failed to request snapshot %v", err)
+				}
+				v := <-sr.ResultC()
+				if v.Aborted() {
+					aborted = true
+					continue
+				}
+				if v.code == requestRejected {
+					continue
+				}
+				if !v.Completed() {
+					t.Fatalf("failed to complete the requested snapshot, %s", v.code)
+				}
+				index = v.SnapshotIndex()
+				break
+			}
+			if !aborted {
+				t.Fatalf("never aborted")
+			}
+			logdb := nh.mu.logdb
+			snapshot, err := logdb.GetSnapshot(1, 1)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if !pb.IsEmptySnapshot(snapshot) {
+				t.Fatalf("snapshot record unexpectedly inserted into the system")
+			}
+			snapshotDir := fmt.Sprintf("snapshot-%016X", index)
+			snapshotFile := fmt.Sprintf("snapshot-%016X.gbsnap", index)
+			fp := fs.PathJoin(sspath, snapshotDir, snapshotFile)
+			exist, err := fileutil.Exist(fp, fs)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if !exist {
+				t.Errorf("snapshot file not saved")
+			}
+			metafp := fs.PathJoin(sspath, snapshotDir, "snapshot.metadata")
+			exist, err = fileutil.Exist(metafp, fs)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if !exist {
+				t.Errorf("snapshot metadata not saved")
+			}
+			shrunk, err := rsm.IsShrunkSnapshotFile(fp, fs)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if shrunk {
+				t.Errorf("exported snapshot is considered as shrunk")
+			}
+			var ss pb.Snapshot
+			if err := fileutil.GetFlagFileContent(fs.PathJoin(sspath, snapshotDir),
+				"snapshot.metadata", &ss, fs); err != nil {
+				t.Fatalf("failed to get snapshot from its metadata file")
+			}
+			if ss.OnDiskIndex == 0 {
+				t.Errorf("on disk index is not recorded")
+			}
+			if ss.Imported {
+				t.Errorf("incorrectly recorded as imported")
+			}
+			if ss.Type != pb.OnDiskStateMachine {
+				t.Errorf("incorrect type")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func testImportedSnapshotIsAlwaysRestored(t *testing.T,
+	newDir bool, ct config.CompressionType, fs vfs.IFS) {
+	tf := func() {
+		rc := config.Config{
+			ShardID:                 1,
+			ReplicaID:               1,
+			ElectionRTT:             3,
+			HeartbeatRTT:            1,
+			CheckQuorum:             true,
+			SnapshotEntries:         5,
+			CompactionOverhead:      2,
+			SnapshotCompressionType: ct,
+		}
+		peers := make(map[uint64]string)
+		peers[1] = nodeHostTestAddr1
+		nhc := config.NodeHostConfig{
+			NodeHostDir:    singleNodeHostTestDir,
+			RTTMillisecond: getRTTMillisecond(fs, singleNodeHostTestDir),
+			RaftAddress:    nodeHostTestAddr1,
+			Expert:         getTestExpertConfig(fs),
+		}
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			t.Fatalf("failed to create node host %v", err)
+		}
+		pto := lpto(nh)
+		newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return tests.NewSimDiskSM(0)
+		}
+		if err := nh.StartOnDiskReplica(peers, false, newSM, rc); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		waitForLeaderToBeElected(t, nh, 1)
+		makeProposals := func(nn *NodeHost) {
+			session := nn.GetNoOPSession(1)
+			for i := 0; i < 16; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), pto)
+				_, err := nn.SyncPropose(ctx, session, []byte("test-data"))
+				cancel()
+				if err != nil {
+					t.Errorf("failed to make proposal %v", err)
+				}
+			}
+		}
+		makeProposals(nh)
+		sspath := "exported_snapshot_safe_to_delete"
+		if err := fs.RemoveAll(sspath); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := fs.MkdirAll(sspath, 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer func() {
+			if err := fs.RemoveAll(sspath); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}()
+		opt := SnapshotOption{
+			Exported:   true,
+			ExportPath: sspath,
+		}
+		var index uint64
+		for i := 0; i < 1000; i++ {
+			if i == 999 {
+				t.Fatalf("failed to export snapshot")
+			}
+			sr, err := nh.RequestSnapshot(1, opt, pto)
+			if err != nil {
+				t.Fatalf("failed to request snapshot %v", err)
+			}
+			v := <-sr.ResultC()
+			if v.Rejected() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			if v.Completed() {
+				index = v.SnapshotIndex()
+				break
+			}
+		}
+		makeProposals(nh)
+		ctx, cancel := context.WithTimeout(context.Background(), pto)
+		rv, err := nh.SyncRead(ctx, 1, nil)
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to read applied value %v", err)
+		}
+		applied := rv.(uint64)
+		if applied <= index {
+			t.Fatalf("invalid applied value %d", applied)
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), pto)
+		if err := nh.SyncRequestAddReplica(ctx, 1, 2, "noidea:8080", 0); err != nil {
+			t.Fatalf("failed to add node %v", err)
+		}
+		nh.Close()
+		snapshotDir := fmt.Sprintf("snapshot-%016X", index)
+		dir := fs.PathJoin(sspath, snapshotDir)
+		members := make(map[uint64]string)
+		members[1] = nhc.RaftAddress
+		if newDir {
+			nhc.NodeHostDir = fs.PathJoin(nhc.NodeHostDir, "newdir")
+		}
+		if err := tools.ImportSnapshot(nhc, dir, members, 1); err != nil {
+			t.Fatalf("failed to import snapshot %v", err)
+		}
+		ok, err := upgrade310.CanUpgradeToV310(nhc)
+		if err != nil {
+			t.Errorf("failed to check whether upgrade is possible")
+		}
+		if ok {
+			t.Errorf("should not be considered as ok to upgrade")
+		}
+		func() {
+			rnh, err := NewNodeHost(nhc)
+			if err != nil {
+				t.Fatalf("failed to create node host %v", err)
+			}
+			defer rnh.Close()
+			rnewSM := func(uint64, uint64) sm.IOnDiskStateMachine {
+				return tests.NewSimDiskSM(applied)
+			}
+			if err := rnh.StartOnDiskReplica(nil, false, rnewSM, rc); err != nil {
+				t.Fatalf("failed to start shard %v", err)
+			}
+			waitForLeaderToBeElected(t, rnh, 1)
+			ctx, cancel = context.WithTimeout(context.Background(), pto)
+			rv, err = rnh.SyncRead(ctx, 1, nil)
+			cancel()
+			if err != nil {
+				t.Fatalf("failed to read applied value %v", err)
+			}
+			if index != rv.(uint64) {
+				t.Fatalf("invalid returned value %d", rv.(uint64))
+			}
+			makeProposals(rnh)
+		}()
+		ok, err = upgrade310.CanUpgradeToV310(nhc)
+		if err != nil {
+			t.Errorf("failed to check whether upgrade is possible")
+		}
+		if !ok {
+			t.Errorf("can not upgrade")
+		}
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
+func TestImportedSnapshotIsAlwaysRestored(t *testing.T) {
+	if vfs.GetTestFS() != vfs.DefaultFS {
+		t.Skip("not using the default fs")
+	} else {
+		fs := vfs.GetTestFS()
+		testImportedSnapshotIsAlwaysRestored(t, true, config.NoCompression, fs)
+		testImportedSnapshotIsAlwaysRestored(t, false, config.NoCompression, fs)
+		testImportedSnapshotIsAlwaysRestored(t, false, config.Snappy, fs)
+	}
+}
+
+func TestShardWithoutQuorumCanBeRestoreByImportingSnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		nh1dir := fs.PathJoin(singleNodeHostTestDir, "nh1")
+		nh2dir := fs.PathJoin(singleNodeHostTestDir, "nh2")
+		rc := config.Config{
+			ShardID:            1,
+			ReplicaID:          1,
+			ElectionRTT:        10,
+			HeartbeatRTT:       1,
+			CheckQuorum:        true,
+			SnapshotEntries:    5,
+			CompactionOverhead: 2,
+		}
+		peers := make(map[uint64]string)
+		peers[1] = nodeHostTestAddr1
+		nhc1 := config.NodeHostConfig{
+			WALDir:         nh1dir,
+			NodeHostDir:    nh1dir,
+			RTTMillisecond: getRTTMillisecond(fs, nh1dir),
+			RaftAddress:    nodeHostTestAddr1,
+			Expert:         getTestExpertConfig(fs),
+		}
+		nhc2 := config.NodeHostConfig{
+			WALDir:         nh2dir,
+			NodeHostDir:    nh2dir,
+			RTTMillisecond: getRTTMillisecond(fs, nh2dir),
+			RaftAddress:    nodeHostTestAddr2,
+			Expert:         getTestExpertConfig(fs),
+		}
+		var once sync.Once
+		nh1, err := NewNodeHost(nhc1)
+		if err != nil {
+			t.Fatalf("failed to create node host %v", err)
+		}
+		nh2, err := NewNodeHost(nhc2)
+		if err != nil {
+			t.Fatalf("failed to create node host %v", err)
+		}
+		sm1 := tests.NewFakeDiskSM(0)
+		sm1.SetAborted()
+		newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return sm1
+		}
+		newSM2 := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return tests.NewFakeDiskSM(0)
+		}
+		if err := nh1.StartOnDiskReplica(peers, false, newSM, rc); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		waitForLeaderToBeElected(t, nh1, 1)
+		defer func() {
+			if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}()
+		defer once.Do(func() {
+			nh1.Close()
+			nh2.Close()
+		})
+		session := nh1.GetNoOPSession(1)
+		mkproposal := func(nh *NodeHost) {
+			done := false
+			pto := pto(nh)
+			for i := 0; i < 100; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), pto)
+				_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
+				cancel()
+				if err == nil {
+					done = true
+					break
+				} else {
+					time.Sleep(200 * time.Millisecond)
+				}
+			}
+			if !done {
+				t.Fatalf("failed to make proposal on restored shard")
+			}
+		}
+		mkproposal(nh1)
+		sspath := "exported_snapshot_safe_to_delete"
+		if err := fs.RemoveAll(sspath); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := fs.MkdirAll(sspath, 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer func() {
+			if err := fs.RemoveAll(sspath); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}()
+		opt := SnapshotOption{
+			Exported:   true,
+			ExportPath: sspath,
+		}
+		pto := lpto(nh1)
+		sr, err := nh1.RequestSnapshot(1, opt, pto)
+		if err != nil {
+			t.Fatalf("failed to request snapshot %v", err)
+		}
+		var index uint64
+		v := <-sr.ResultC()
+		if !v.Completed() {
+			t.Fatalf("failed to complete the requested snapshot")
+		}
+		index = v.SnapshotIndex()
+		snapshotDir := fmt.Sprintf("snapshot-%016X", index)
+		dir := fs.PathJoin(sspath, snapshotDir)
+		members := make(map[uint64]string)
+		members[1] = nhc1.RaftAddress
+		members[10] = nhc2.RaftAddress
+		once.Do(func() {
+			nh1.Close()
+			nh2.Close()
+		})
+		if err := tools.ImportSnapshot(nhc1, dir, members, 1); err != nil {
+			t.Fatalf("failed to import snapshot %v", err)
+		}
+		if err := tools.ImportSnapshot(nhc2, dir, members, 10); err != nil {
+			t.Fatalf("failed to import snapshot %v", err)
+		}
+		rnh1, err := NewNodeHost(nhc1)
+		if err != nil {
+			t.Fatalf("failed to create node host %v", err)
+		}
+		rnh2, err := NewNodeHost(nhc2)
+		if err != nil {
+			t.Fatalf("failed to create node host %v", err)
+		}
+		defer func() {
+			rnh1.Close()
+			rnh2.Close()
+		}()
+		if err := rnh1.StartOnDiskReplica(nil, false, newSM, rc); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		rc.ReplicaID = 10
+		if err := rnh2.StartOnDiskReplica(nil, false, newSM2, rc); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		waitForLeaderToBeElected(t, rnh1, 1)
+		mkproposal(rnh1)
+		mkproposal(rnh2)
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
+type chunks struct {
+	received  uint64
+	confirmed uint64
+}
+
+var (
+	testSnapshotDir = "test_snapshot_dir_safe_to_delete"
+)
+
+func (c *chunks) onReceive(pb.MessageBatch) {
+	c.received++
+}
+
+func (c *chunks) confirm(shardID uint64, replicaID uint64, index uint64) {
+	c.confirmed++
+}
+
+func (c *chunks) getSnapshotDirFunc(shardID uint64, replicaID uint64) string {
+	return testSnapshotDir
+}
+
+type testSink2 struct {
+	receiver chunkReceiver
+}
+
+func (s *testSink2) Receive(chunk pb.Chunk) (bool, bool) {
+	s.receiver.Add(chunk)
+	return true, false
+}
+
+func (s *testSink2) Close() error {
+	s.Receive(pb.Chunk{ChunkCount: pb.PoisonChunkCount})
+	return nil
+}
+
+func (s *testSink2) ShardID() uint64 {
+	return 2000
+}
+
+func (s *testSink2) ToReplicaID() uint64 {
+	return 300
+}
+
+type dataCorruptionSink struct {
+	receiver chunkReceiver
+	enabled  bool
+}
+
+func (s *dataCorruptionSink) Receive(chunk pb.Chunk) (bool, bool) {
+	if s.enabled && len(chunk.Data) > 0 {
+		idx := mrand.Uint64() % uint64(len(chunk.Data))
+		chunk.Data[idx] = chunk.Data[idx] + 1
+	}
+	s.receiver.Add(chunk)
+	return true, false
+}
+
+func (s *dataCorruptionSink) Close() error {
+	s.Receive(pb.Chunk{ChunkCount: pb.PoisonChunkCount})
+	return nil
+}
+
+func (s *dataCorruptionSink) ShardID() uint64 {
+	return 2000
+}
+
+func (s *dataCorruptionSink) ToReplicaID() uint64 {
+	return 300
+}
+
+type chunkReceiver interface {
+	Add(chunk pb.Chunk) bool
+}
+
+func getTestSSMeta() rsm.SSMeta {
+	return rsm.SSMeta{
+		Index: 1000,
+		Term:  5,
+		From:  150,
+	}
+}
+
+func testCorruptedChunkWriterOutputCanBeHandledByChunk(t *testing.T,
+	enabled bool, exp uint64, fs vfs.IFS) {
+	if err := fs.RemoveAll(testSnapshotDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	c := &chunks{}
+	if err := fs.MkdirAll(c.getSnapshotDirFunc(0, 0), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	cks := transport.NewChunk(c.onReceive,
+		c.confirm, c.getSnapshotDirFunc, 0, fs)
+	sink := &dataCorruptionSink{receiver: cks, enabled: enabled}
+	meta := getTestSSMeta()
+	cw := rsm.NewChunkWriter(sink, meta)
+	defer func() {
+		if err := fs.RemoveAll(testSnapshotDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		data := make([]byte, rsm.ChunkSize)
+		_, _ = rand.Read(data)
+		if _, err := cw.Write(data); err != nil {
+			t.Fatalf("failed to write the data %v", err)
+		}
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatalf("failed to flush %v", err)
+	}
+	if c.received != exp {
+		t.Fatalf("unexpected received count: %d, want %d", c.received, exp)
+	}
+	if c.confirmed != exp {
+		t.Fatalf("unexpected confirmed count: %d, want %d", c.confirmed, exp)
+	}
+}
+
+func TestCorruptedChunkWriterOutputCanBeHandledByChunk(t *testing.T) {
+	fs := vfs.GetTestFS()
+	testCorruptedChunkWriterOutputCanBeHandledByChunk(t, false, 1, fs)
+	testCorruptedChunkWriterOutputCanBeHandledByChunk(t, true, 0, fs)
+}
+
+func TestChunkWriterOutputCanBeHandledByChunk(t *testing.T) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(testSnapshotDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	c := &chunks{}
+	if err := fs.MkdirAll(c.getSnapshotDirFunc(0, 0), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	cks := transport.NewChunk(c.onReceive,
+		c.confirm, c.getSnapshotDirFunc, 0, fs)
+	sink := &testSink2{receiver: cks}
+	meta := getTestSSMeta()
+	cw := rsm.NewChunkWriter(sink, meta)
+	if _, err := cw.Write(rsm.GetEmptyLRUSession()); err != nil {
+		t.Fatalf("write failed %v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(testSnapshotDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	payload := make([]byte, 0)
+	payload = append(payload, rsm.GetEmptyLRUSession()...)
+	for i := 0; i < 10; i++ {
+		data := make([]byte, rsm.ChunkSize)
+		_, _ = rand.Read(data)
+		payload = append(payload, data...)
+		if _, err := cw.Write(data); err != nil {
+			t.Fatalf("failed to write the data %v", err)
+		}
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatalf("failed to flush %v", err)
+	}
+	if c.received != 1 {
+		t.Fatalf("failed to receive the snapshot")
+	}
+	if c.confirmed != 1 {
+		t.Fatalf("failed to confirm")
+	}
+	fp := fs.PathJoin(testSnapshotDir,
+		"snapshot-00000000000003E8", "snapshot-00000000000003E8.gbsnap")
+	reader, _, err := rsm.NewSnapshotReader(fp, fs)
+	if err != nil {
+		t.Fatalf("failed to get a snapshot reader %v", err)
+	}
+	defer reader.Close()
+	got := make([]byte, 0)
+	buf := make([]byte, 1024*256)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			got = append(got, buf[:n]...)
+		}
+		if err == io.EOF {
+			break
 		}
-		t.Errorf("failed to get is nonVoting flag")
 	}
-	twoFakeDiskNodeHostTest(t, tf, fs)
+	if !bytes.Equal(got, payload) {
+		t.Errorf("snapshot content changed")
+	}
 }
 
-func TestSnapshotIndexWillPanicOnRegularRequestResult(t *testing.T) {
+func TestNodeHostReturnsErrorWhenTransportCanNotBeCreated(t *testing.T) {
 	fs := vfs.GetTestFS()
+	if fs != vfs.DefaultFS {
+		t.Skip("memfs test mode, skipped")
+	}
 	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			cs := nh.GetNoOPSession(1)
-			pto := pto(nh)
-			rs, err := nh.Propose(cs, make([]byte, 1), pto)
-			if err != nil {
-				t.Fatalf("propose failed %v", err)
-			}
-			defer func() {
-				if r := recover(); r == nil {
-					t.Fatalf("no panic")
-				}
-			}()
-			v := <-rs.ResultC()
-			plog.Infof("%d", v.SnapshotIndex())
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.RaftAddress = "microsoft.com:12345"
+			return c
 		},
+		newNodeHostToFail: true,
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestSyncRequestSnapshot(t *testing.T) {
+func TestNodeHostChecksLogDBType(t *testing.T) {
 	fs := vfs.GetTestFS()
+	ldb := &noopLogDB{}
 	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			session := nh.GetNoOPSession(1)
-			pto := lpto(nh)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			cmd := make([]byte, 1518)
-			_, err := nh.SyncPropose(ctx, session, cmd)
-			cancel()
-			if err != nil {
-				t.Fatalf("failed to make proposal %v", err)
-			}
-			ctx, cancel = context.WithTimeout(context.Background(), pto)
-			idx, err := nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption)
-			cancel()
-			if err != nil {
-				t.Fatalf("%v", err)
-			}
-			if idx == 0 {
-				t.Errorf("unexpected index %d", idx)
-			}
-			listener, ok := nh.events.sys.ul.(*testSysEventListener)
-			if !ok {
-				t.Fatalf("failed to get the system event listener")
-			}
-			waitSnapshotInfoEvent(t, listener.getSnapshotCreated, 1)
-			si := listener.getSnapshotCreated()[0]
-			if si.ShardID != 1 || si.ReplicaID != 1 {
-				t.Fatalf("incorrect created snapshot info")
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.Expert.LogDBFactory = &testLogDBFactory{ldb: ldb}
+			return c
+		},
+		at: func(*NodeHost) {
+			nhc := getTestNodeHostConfig(fs)
+			_, err := NewNodeHost(*nhc)
+			if err != server.ErrLogDBType {
+				t.Fatalf("didn't report logdb type error %v", err)
 			}
 		},
+		noElection: true,
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestSnapshotCanBeExportedAfterSnapshotting(t *testing.T) {
+var spawnChild = flag.Bool("spawn-child", false, "spawned child")
+
+func spawn(execName string) ([]byte, error) {
+	return exec.Command(execName, "-spawn-child",
+		"-test.v", "-test.run=TestNodeHostFileLock$").CombinedOutput()
+}
+
+func TestNodeHostFileLock(t *testing.T) {
 	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			session := nh.GetNoOPSession(1)
-			pto := lpto(nh)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			cmd := make([]byte, 1518)
-			_, err := nh.SyncPropose(ctx, session, cmd)
-			cancel()
-			if err != nil {
-				t.Fatalf("failed to make proposal %v", err)
-			}
-			ctx, cancel = context.WithTimeout(context.Background(), pto)
-			idx, err := nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption)
-			cancel()
+	if fs != vfs.DefaultFS {
+		t.Skip("not using the default fs, skipped")
+	}
+	tf := func() {
+		child := *spawnChild
+		nhc := config.NodeHostConfig{
+			NodeHostDir:    singleNodeHostTestDir,
+			RTTMillisecond: getRTTMillisecond(fs, singleNodeHostTestDir),
+			RaftAddress:    nodeHostTestAddr1,
+			Expert:         getTestExpertConfig(fs),
+		}
+		if !child {
+			nh, err := NewNodeHost(nhc)
 			if err != nil {
-				t.Fatalf("%v", err)
-			}
-			if idx == 0 {
-				t.Errorf("unexpected index %d", idx)
-			}
-			sspath := "exported_snapshot_safe_to_delete"
-			if err := fs.RemoveAll(sspath); err != nil {
-				t.Fatalf("%v", err)
+				t.Fatalf("failed to create nodehost %v", err)
 			}
-			if err := fs.MkdirAll(sspath, 0755); err != nil {
-				t.Fatalf("%v", err)
+			defer nh.Close()
+			out, err := spawn(os.Args[0])
+			if err == nil {
+				t.Fatalf("file lock didn't prevent the second nh to start, %s", out)
 			}
-			defer func() {
-				if err := fs.RemoveAll(sspath); err != nil {
-					t.Fatalf("%v", err)
-				}
-			}()
-			opt := SnapshotOption{
-				Exported:   true,
-				ExportPath: sspath,
+			if !bytes.Contains(out, []byte("returned ErrLockDirectory")) {
+				t.Fatalf("unexpected output: %s", out)
 			}
-			ctx, cancel = context.WithTimeout(context.Background(), pto)
-			exportIdx, err := nh.SyncRequestSnapshot(ctx, 1, opt)
-			cancel()
-			if err != nil {
-				t.Fatalf("%v", err)
+		} else {
+			nhc.RaftAddress = nodeHostTestAddr2
+			cnh, err := NewNodeHost(nhc)
+			if err == server.ErrLockDirectory {
+				t.Fatalf("returned ErrLockDirectory")
 			}
-			if exportIdx != idx {
-				t.Errorf("unexpected index %d, want %d", exportIdx, idx)
+			if err == nil {
+				defer cnh.Close()
 			}
-		},
+		}
 	}
-	runNodeHostTest(t, to, fs)
+	runNodeHostTestDC(t, tf, !*spawnChild, fs)
 }
 
-func TestCanOverrideSnapshotOverhead(t *testing.T) {
+func TestChangeNodeHostID(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		nhc := config.NodeHostConfig{
+			NodeHostDir:    singleNodeHostTestDir,
+			RTTMillisecond: getRTTMillisecond(fs, singleNodeHostTestDir),
+			RaftAddress:    nodeHostTestAddr1,
+			Expert:         getTestExpertConfig(fs),
+		}
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			t.Fatalf("failed to create nodehost %v", err)
+		}
+		nh.Close()
+		v := id.New()
+		nhc.NodeHostID = v.String()
+		_, err = NewNodeHost(nhc)
+		if err == nil || !errors.Is(err, server.ErrNodeHostIDChanged) {
+			t.Fatalf("failed to reject changed NodeHostID %v", err)
+		}
+	}
+	runNodeHostTestDC(t, tf, !*spawnChild, fs)
+}
+
+type testLogDBFactory2 struct {
+	f func(config.NodeHostConfig,
+		config.LogDBCallback, []string, []string) (raftio.ILogDB, error)
+	name string
+}
+
+func (t *testLogDBFactory2) Create(cfg config.NodeHostConfig, cb config.LogDBCallback,
+	dirs []string, wals []string) (raftio.ILogDB, error) {
+	return t.f(cfg, cb, dirs, wals)
+}
+
+func (t *testLogDBFactory2) Name() string {
+	return t.name
+}
+
+func TestNodeHostReturnsErrLogDBBrokenChangeWhenLogDBTypeChanges(t *testing.T) {
 	fs := vfs.GetTestFS()
+	bff := func(config config.NodeHostConfig, cb config.LogDBCallback,
+		dirs []string, lldirs []string) (raftio.ILogDB, error) {
+		return logdb.NewDefaultBatchedLogDB(config, cb, dirs, lldirs)
+	}
+	nff := func(config config.NodeHostConfig, cb config.LogDBCallback,
+		dirs []string, lldirs []string) (raftio.ILogDB, error) {
+		return logdb.NewDefaultLogDB(config, cb, dirs, lldirs)
+	}
 	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			session := nh.GetNoOPSession(1)
-			cmd := make([]byte, 1)
-			pto := pto(nh)
-			for i := 0; i < 16; i++ {
-				ctx, cancel := context.WithTimeout(context.Background(), pto)
-				_, err := nh.SyncPropose(ctx, session, cmd)
-				cancel()
-				if err != nil {
-					// see comments in testOnDiskStateMachineCanTakeDummySnapshot
-					if err == ErrTimeout {
-						time.Sleep(500 * time.Millisecond)
-						continue
-					}
-					t.Fatalf("failed to make proposal %v", err)
-				}
-			}
-			opt := SnapshotOption{
-				OverrideCompactionOverhead: true,
-				CompactionOverhead:         0,
-			}
-			lpto := lpto(nh)
-			sr, err := nh.RequestSnapshot(1, opt, lpto)
-			if err != nil {
-				t.Fatalf("failed to request snapshot")
-			}
-			v := <-sr.ResultC()
-			if !v.Completed() {
-				t.Errorf("failed to complete the requested snapshot")
-			}
-			if v.SnapshotIndex() < 16 {
-				t.Fatalf("unexpected snapshot index %d", v.SnapshotIndex())
-			}
-			logdb := nh.mu.logdb
-			for i := 0; i < 1000; i++ {
-				if i == 999 {
-					t.Fatalf("failed to compact the entries")
-				}
-				time.Sleep(10 * time.Millisecond)
-				op, err := nh.RequestCompaction(1, 1)
-				if err == nil {
-					<-op.ResultC()
-				}
-				ents, _, err := logdb.IterateEntries(nil, 0, 1, 1, 12, 14, math.MaxUint64)
-				if err != nil {
-					t.Fatalf("failed to iterate entries, %v", err)
-				}
-				if len(ents) != 0 {
-					continue
-				} else {
-					return
-				}
+		at: func(*NodeHost) {
+			nhc := getTestNodeHostConfig(fs)
+			nhc.Expert.LogDBFactory = &testLogDBFactory2{f: nff}
+			if _, err := NewNodeHost(*nhc); err != server.ErrLogDBBrokenChange {
+				t.Errorf("failed to return ErrLogDBBrokenChange")
 			}
 		},
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.Expert.LogDBFactory = &testLogDBFactory2{f: bff}
+			return c
+		},
+		noElection: true,
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestSnapshotCanBeRequested(t *testing.T) {
+func TestNodeHostByDefaultUsePlainEntryLogDB(t *testing.T) {
 	fs := vfs.GetTestFS()
+	bff := func(config config.NodeHostConfig, cb config.LogDBCallback,
+		dirs []string, lldirs []string) (raftio.ILogDB, error) {
+		return logdb.NewDefaultBatchedLogDB(config, cb, dirs, lldirs)
+	}
+	nff := func(config config.NodeHostConfig, cb config.LogDBCallback,
+		dirs []string, lldirs []string) (raftio.ILogDB, error) {
+		return logdb.NewDefaultLogDB(config, cb, dirs, lldirs)
+	}
 	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			pto := lpto(nh)
-			session := nh.GetNoOPSession(1)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			cmd := make([]byte, 1518)
-			_, err := nh.SyncPropose(ctx, session, cmd)
-			cancel()
-			if err != nil {
-				t.Fatalf("failed to make proposal %v", err)
-			}
-			sr, err := nh.RequestSnapshot(1, SnapshotOption{}, pto)
-			if err != nil {
-				t.Errorf("failed to request snapshot")
-			}
-			var index uint64
-			v := <-sr.ResultC()
-			if !v.Completed() {
-				t.Errorf("failed to complete the requested snapshot")
-			}
-			index = v.SnapshotIndex()
-			sr, err = nh.RequestSnapshot(1, SnapshotOption{}, pto)
-			if err != nil {
-				t.Fatalf("failed to request snapshot")
-			}
-			v = <-sr.ResultC()
-			if !v.Rejected() {
-				t.Errorf("failed to complete the requested snapshot")
-			}
-			logdb := nh.mu.logdb
-			snapshot, err := logdb.GetSnapshot(1, 1)
-			if err != nil {
-				t.Fatalf("%v", err)
-			}
-			if pb.IsEmptySnapshot(snapshot) {
-				t.Fatalf("failed to save snapshots")
-			}
-			if snapshot.Index != index {
-				t.Errorf("unexpected index value")
-			}
-			reader, header, err := rsm.NewSnapshotReader(snapshot.Filepath, fs)
-			if err != nil {
-				t.Fatalf("failed to new snapshot reader %v", err)
-			}
-			defer reader.Close()
-			if rsm.SSVersion(header.Version) != rsm.V2 {
-				t.Errorf("unexpected snapshot version")
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.Expert.LogDBFactory = &testLogDBFactory2{f: nff}
+			return c
+		},
+		noElection: true,
+		at: func(*NodeHost) {
+			nhc := getTestNodeHostConfig(fs)
+			nhc.Expert.LogDBFactory = &testLogDBFactory2{f: bff}
+			if _, err := NewNodeHost(*nhc); err != server.ErrIncompatibleData {
+				t.Errorf("failed to return server.ErrIncompatibleData")
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestClientCanBeNotifiedOnCommittedConfigChange(t *testing.T) {
+func TestNodeHostByDefaultChecksWhetherToUseBatchedLogDB(t *testing.T) {
 	fs := vfs.GetTestFS()
+	bff := func(config config.NodeHostConfig, cb config.LogDBCallback,
+		dirs []string, lldirs []string) (raftio.ILogDB, error) {
+		return logdb.NewDefaultBatchedLogDB(config, cb, dirs, lldirs)
+	}
+	nff := func(config config.NodeHostConfig, cb config.LogDBCallback,
+		dirs []string, lldirs []string) (raftio.ILogDB, error) {
+		return logdb.NewDefaultLogDB(config, cb, dirs, lldirs)
+	}
 	to := &testOption{
-		defaultTestNode: true,
 		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
-			c.NotifyCommit = true
+			c.Expert.LogDBFactory = &testLogDBFactory2{f: bff}
 			return c
 		},
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &PST{}
+		},
 		tf: func(nh *NodeHost) {
 			pto := pto(nh)
-			rs, err := nh.RequestAddReplica(1, 2, "localhost:3456", 0, pto)
+			cs := nh.GetNoOPSession(1)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			_, err := nh.SyncPropose(ctx, cs, []byte("test-data"))
+			cancel()
 			if err != nil {
-				t.Fatalf("failed to request add node")
-			}
-			if rs.committedC == nil {
-				t.Fatalf("committedC not set")
+				t.Errorf("failed to make proposal %v", err)
 			}
-			cn := <-rs.ResultC()
-			if !cn.Committed() {
-				t.Fatalf("failed to get committed notification")
+		},
+		at: func(*NodeHost) {
+			nhc := getTestNodeHostConfig(fs)
+			nhc.Expert.LogDBFactory = &testLogDBFactory2{f: nff}
+			if nh, err := NewNodeHost(*nhc); err != nil {
+				t.Errorf("failed to create node host")
+			} else {
+				nh.Close()
 			}
-			cn = <-rs.ResultC()
-			if !cn.Completed() {
-				t.Fatalf("failed to get completed notification")
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestNodeHostWithUnexpectedDeploymentIDWillBeDetected(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		noElection: true,
+		at: func(*NodeHost) {
+			nhc := getTestNodeHostConfig(fs)
+			nhc.DeploymentID = 200
+			_, err := NewNodeHost(*nhc)
+			if err != server.ErrDeploymentIDChanged {
+				t.Errorf("failed to return ErrDeploymentIDChanged, got %v", err)
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestClientCanBeNotifiedOnCommittedProposals(t *testing.T) {
+func TestGossipInfoIsReported(t *testing.T) {
 	fs := vfs.GetTestFS()
+	advertiseAddress := "202.96.1.2:12345"
 	to := &testOption{
-		defaultTestNode: true,
+		noElection: true,
 		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
-			c.NotifyCommit = true
+			c.DefaultNodeRegistryEnabled = true
+			c.Gossip = config.GossipConfig{
+				BindAddress:      "localhost:23001",
+				AdvertiseAddress: advertiseAddress,
+				Seed:             []string{"localhost:23002"},
+			}
 			return c
 		},
 		tf: func(nh *NodeHost) {
-			pto := pto(nh)
-			cmd := make([]byte, 128)
-			session := nh.GetNoOPSession(1)
-			rs, err := nh.Propose(session, cmd, pto)
-			if err != nil {
-				t.Fatalf("failed to make proposal %v", err)
+			nhi := nh.GetNodeHostInfo(DefaultNodeHostInfoOption)
+			if nhi.Gossip.AdvertiseAddress != advertiseAddress {
+				t.Errorf("unexpected advertise address, got %s, want %s",
+					nhi.Gossip.AdvertiseAddress, advertiseAddress)
 			}
-			if rs.committedC == nil {
-				t.Fatalf("committedC not set")
+			if !nhi.Gossip.Enabled {
+				t.Errorf("gossip info not marked as enabled")
 			}
-			cn := <-rs.ResultC()
-			if !cn.Committed() {
-				t.Fatalf("failed to get committed notification")
+			if nhi.Gossip.NumOfKnownNodeHosts != 1 {
+				t.Errorf("unexpected NumOfKnownNodeHosts, got %d, want 1",
+					nhi.Gossip.NumOfKnownNodeHosts)
 			}
-			cn = <-rs.ResultC()
-			if !cn.Completed() {
-				t.Fatalf("failed to get completed notification")
+			if nhi.NodeHostID != nh.ID() {
+				t.Errorf("unexpected NodeHostID, got %s, want %s", nhi.NodeHostID, nh.ID())
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestRequestSnapshotTimeoutWillBeReported(t *testing.T) {
+func TestGossipJoinTimeoutIsEnforced(t *testing.T) {
 	fs := vfs.GetTestFS()
-	pst := &PST{slowSave: true}
-	to := &testOption{
-		createSM: func(uint64, uint64) sm.IStateMachine {
-			return pst
+	datadir := fs.PathJoin(singleNodeHostTestDir, "nh1")
+	_ = os.RemoveAll(singleNodeHostTestDir)
+	defer os.RemoveAll(singleNodeHostTestDir)
+	listener := &testSysEventListener{}
+	nhc := config.NodeHostConfig{
+		NodeHostDir:                datadir,
+		RTTMillisecond:             getRTTMillisecond(fs, datadir),
+		RaftAddress:                nodeHostTestAddr1,
+		DefaultNodeRegistryEnabled: true,
+		SystemEventListener:        listener,
+		Expert:                     config.ExpertConfig{FS: fs},
+		Gossip: config.GossipConfig{
+			BindAddress:      "127.0.0.1:25001",
+			AdvertiseAddress: "127.0.0.1:25001",
+			Seed:             []string{"dns:///localhost:25002"},
+			JoinTimeout:      300 * time.Millisecond,
 		},
-		tf: func(nh *NodeHost) {
-			pto := pto(nh)
-			sr, err := nh.RequestSnapshot(1, SnapshotOption{}, pto)
-			if err != nil {
-				t.Fatalf("failed to request snapshot")
-			}
-			v := <-sr.ResultC()
-			if !v.Timeout() {
-				t.Errorf("failed to report timeout")
+	}
+	if _, err := NewNodeHost(nhc); !errors.Is(err, ErrGossipJoinFailed) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	nhc.Gossip.ContinueOnJoinFailure = true
+	nh, err := NewNodeHost(nhc)
+	if err != nil {
+		t.Fatalf("failed to create nodehost %v", err)
+	}
+	defer nh.Close()
+	for i := 0; i < 1000; i++ {
+		isolated, _ := listener.getGossipEvents()
+		if len(isolated) > 0 {
+			if isolated[0].AdvertiseAddress != "127.0.0.1:25001" ||
+				isolated[0].Members != 1 {
+				t.Errorf("unexpected gossip info %+v", isolated[0])
 			}
-		},
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
 	}
-	runNodeHostTest(t, to, fs)
+	t.Fatalf("GossipIsolated event not published")
 }
 
-func TestSyncRemoveData(t *testing.T) {
+func TestLeaderInfoIsReported(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
 		defaultTestNode: true,
 		tf: func(nh *NodeHost) {
-			if err := nh.StopShard(1); err != nil {
-				t.Fatalf("failed to remove shard %v", err)
+			leaderAvailable := false
+			for i := 0; i < 500; i++ {
+				nhi := nh.GetNodeHostInfo(DefaultNodeHostInfoOption)
+				if len(nhi.ShardInfoList) != 1 {
+					t.Errorf("unexpected len: %d", len(nhi.ShardInfoList))
+				}
+				if nhi.ShardInfoList[0].ShardID != 1 {
+					t.Fatalf("unexpected shard id")
+				}
+				if nhi.ShardInfoList[0].LeaderID != 1 {
+					time.Sleep(20 * time.Millisecond)
+				} else {
+					leaderAvailable = true
+					break
+				}
 			}
-			pto := lpto(nh)
+			if !leaderAvailable {
+				t.Fatalf("failed to get leader info")
+			}
+			pto := pto(nh)
 			ctx, cancel := context.WithTimeout(context.Background(), pto)
 			defer cancel()
-			if err := nh.SyncRemoveData(ctx, 1, 1); err != nil {
-				t.Fatalf("sync remove data failed: %v", err)
-			}
-			listener, ok := nh.events.sys.ul.(*testSysEventListener)
-			if !ok {
-				t.Fatalf("failed to get the system event listener")
+			if err := nh.SyncRequestAddReplica(ctx, 1, 2, "noidea:8080", 0); err != nil {
+				t.Fatalf("failed to add node %v", err)
 			}
-			waitNodeInfoEvent(t, listener.getNodeUnloaded, 1)
-			ni := listener.getNodeUnloaded()[0]
-			if ni.ShardID != 1 || ni.ReplicaID != 1 {
-				t.Fatalf("incorrect node unloaded info")
+			for i := 0; i < 500; i++ {
+				nhi := nh.GetNodeHostInfo(DefaultNodeHostInfoOption)
+				if len(nhi.ShardInfoList) != 1 {
+					t.Errorf("unexpected len: %d", len(nhi.ShardInfoList))
+				}
+				if nhi.ShardInfoList[0].LeaderID == 1 {
+					time.Sleep(20 * time.Millisecond)
+				} else {
+					return
+				}
 			}
+			t.Fatalf("no leader info change")
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestRemoveNodeDataWillFailWhenNodeIsStillRunning(t *testing.T) {
-	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			if err := nh.RemoveData(1, 1); err != ErrShardNotStopped {
-				t.Errorf("remove data didn't fail")
-			}
-		},
-	}
-	runNodeHostTest(t, to, fs)
+type testMembershipListener struct {
+	mu      sync.Mutex
+	changes []raftio.MembershipChangeInfo
+}
+
+func (l *testMembershipListener) MembershipChanged(info raftio.MembershipChangeInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.changes = append(l.changes, info)
 }
 
-func TestRestartingAnNodeWithRemovedDataWillBeRejected(t *testing.T) {
+func (l *testMembershipListener) getChanges() []raftio.MembershipChangeInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]raftio.MembershipChangeInfo{}, l.changes...)
+}
+
+func TestMembershipChangesAreReported(t *testing.T) {
 	fs := vfs.GetTestFS()
+	ml := &testMembershipListener{}
+	expected := []struct {
+		cct       pb.ConfigChangeType
+		replicaID uint64
+	}{
+		{pb.AddNode, 1},
+		{pb.AddNonVoting, 2},
+		{pb.AddNonVoting, 3},
+		{pb.RemoveNode, 2},
+		{pb.AddNode, 4},
+	}
+	check := func(changes []raftio.MembershipChangeInfo, replayed bool) {
+		if len(changes) != len(expected) {
+			t.Fatalf("unexpected changes %+v", changes)
+		}
+		for i, c := range changes {
+			if c.Type != expected[i].cct || c.ChangedReplicaID != expected[i].replicaID {
+				t.Errorf("%d, unexpected change %+v", i, c)
+			}
+			if c.ShardID != 1 || c.ReplicaID != 1 || c.Replayed != replayed {
+				t.Errorf("%d, unexpected change %+v", i, c)
+			}
+			if i > 0 && c.Index <= changes[i-1].Index {
+				t.Errorf("%d, unexpected index %d", i, c.Index)
+			}
+		}
+		last := changes[len(changes)-1]
+		if len(last.Nodes) != 2 || len(last.NonVotings) != 1 {
+			t.Errorf("unexpected membership %+v", last)
+		}
+		if _, ok := last.Removed[2]; !ok {
+			t.Errorf("removed node not reported")
+		}
+	}
+	wait := func(count int) []raftio.MembershipChangeInfo {
+		for i := 0; i < 500; i++ {
+			if changes := ml.getChanges(); len(changes) >= count {
+				return changes
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("membership changes not reported")
+		return nil
+	}
 	to := &testOption{
 		defaultTestNode: true,
+		restartNodeHost: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.MembershipListener = ml
+			return c
+		},
 		tf: func(nh *NodeHost) {
-			if err := nh.StopShard(1); err != nil {
-				t.Fatalf("failed to remove shard %v", err)
+			pto := pto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			defer cancel()
+			if err := nh.SyncRequestAddNonVoting(ctx, 1, 2, "a2:8080", 0); err != nil {
+				t.Fatalf("failed to add nonVoting %v", err)
 			}
-			for {
-				if err := nh.RemoveData(1, 1); err != nil {
-					if err == ErrShardNotStopped {
-						time.Sleep(100 * time.Millisecond)
-						continue
-					} else {
-						t.Errorf("remove data failed %v", err)
-					}
-				}
-				break
+			if err := nh.SyncRequestAddNonVoting(ctx, 1, 3, "a3:8080", 0); err != nil {
+				t.Fatalf("failed to add nonVoting %v", err)
 			}
-			rc := getTestConfig()
-			peers := make(map[uint64]string)
-			peers[1] = nh.RaftAddress()
-			newPST := func(shardID uint64, replicaID uint64) sm.IStateMachine {
-				return &PST{}
+			if err := nh.SyncRequestDeleteReplica(ctx, 1, 2, 0); err != nil {
+				t.Fatalf("failed to delete replica %v", err)
 			}
-			if err := nh.StartReplica(peers, false, newPST, *rc); err != ErrReplicaRemoved {
-				t.Errorf("start shard failed %v", err)
+			if err := nh.SyncRequestAddReplica(ctx, 1, 4, "a4:8080", 0); err != nil {
+				t.Fatalf("failed to add replica %v", err)
 			}
+			check(wait(len(expected)), false)
+		},
+		rf: func(nh *NodeHost) {
+			changes := wait(len(expected) * 2)
+			check(changes[len(expected):], true)
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestRemoveNodeDataRemovesAllNodeData(t *testing.T) {
+func TestDroppedRequestsAreReported(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
 		defaultTestNode: true,
 		tf: func(nh *NodeHost) {
-			session := nh.GetNoOPSession(1)
 			pto := lpto(nh)
 			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			cmd := make([]byte, 1518)
-			_, err := nh.SyncPropose(ctx, session, cmd)
-			cancel()
-			if err != nil {
-				t.Fatalf("failed to make proposal %v", err)
-			}
-			sr, err := nh.RequestSnapshot(1, SnapshotOption{}, pto)
-			if err != nil {
-				t.Errorf("failed to request snapshot")
-			}
-			v := <-sr.ResultC()
-			if !v.Completed() {
-				t.Errorf("failed to complete the requested snapshot")
-			}
-			if err := nh.StopShard(1); err != nil {
-				t.Fatalf("failed to stop shard %v", err)
-			}
-			logdb := nh.mu.logdb
-			snapshot, err := logdb.GetSnapshot(1, 1)
-			if err != nil {
-				t.Fatalf("%v", err)
-			}
-			if pb.IsEmptySnapshot(snapshot) {
-				t.Fatalf("failed to save snapshots")
-			}
-			snapshotDir := nh.env.GetSnapshotDir(nh.nhConfig.GetDeploymentID(), 1, 1)
-			exist, err := fileutil.Exist(snapshotDir, fs)
-			if err != nil {
-				t.Fatalf("%v", err)
-			}
-			if !exist {
-				t.Fatalf("snapshot dir %s does not exist", snapshotDir)
-			}
-			files, err := fs.List(snapshotDir)
-			if err != nil {
-				t.Fatalf("failed to read dir %v", err)
+			defer cancel()
+			if err := nh.SyncRequestAddReplica(ctx, 1, 2, "noidea:8080", 0); err != nil {
+				t.Fatalf("failed to add node %v", err)
 			}
-			sscount := 0
-			for _, fn := range files {
-				fi, err := fs.Stat(fs.PathJoin(snapshotDir, fn))
+			for i := 0; i < 1000; i++ {
+				_, _, ok, err := nh.GetLeaderID(1)
 				if err != nil {
-					t.Fatalf("failed to get stat for %s", fn)
+					t.Fatalf("failed to get leader id %v", err)
 				}
-				if !fi.IsDir() {
-					continue
+				if err == nil && !ok {
+					break
 				}
-				if server.SnapshotDirNameRe.Match([]byte(fi.Name())) {
-					sscount++
+				time.Sleep(10 * time.Millisecond)
+				if i == 999 {
+					t.Fatalf("leader failed to step down")
 				}
 			}
-			if sscount == 0 {
-				t.Fatalf("no snapshot dir found")
-			}
-			removed := false
-			for i := 0; i < 1000; i++ {
-				err := nh.RemoveData(1, 1)
-				if err == ErrShardNotStopped {
-					time.Sleep(100 * time.Millisecond)
-					continue
+			unlimited := 30 * time.Minute
+			func() {
+				nctx, ncancel := context.WithTimeout(context.Background(), unlimited)
+				defer ncancel()
+				cs := nh.GetNoOPSession(1)
+				for i := 0; i < 10; i++ {
+					if _, err := nh.SyncPropose(nctx, cs, make([]byte, 1)); err != ErrShardNotReady {
+						t.Errorf("failed to get ErrShardNotReady, got %v", err)
+					}
 				}
-				if err != nil {
-					t.Fatalf("failed to remove data %v", err)
+			}()
+			func() {
+				nctx, ncancel := context.WithTimeout(context.Background(), unlimited)
+				defer ncancel()
+				for i := 0; i < 10; i++ {
+					if err := nh.SyncRequestAddReplica(nctx, 1, 3, "noidea:8080", 0); err != ErrShardNotReady {
+						t.Errorf("failed to get ErrShardNotReady, got %v", err)
+					}
 				}
-				if err == nil {
-					removed = true
-					break
+			}()
+			func() {
+				nctx, ncancel := context.WithTimeout(context.Background(), unlimited)
+				defer ncancel()
+				for i := 0; i < 10; i++ {
+					if _, err := nh.SyncRead(nctx, 1, nil); err != ErrShardNotReady {
+						t.Errorf("failed to get ErrShardNotReady, got %v", err)
+					}
 				}
+			}()
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+type testRaftEventListener struct {
+	mu       sync.Mutex
+	received []raftio.LeaderInfo
+}
+
+func (rel *testRaftEventListener) LeaderUpdated(info raftio.LeaderInfo) {
+	rel.mu.Lock()
+	defer rel.mu.Unlock()
+	rel.received = append(rel.received, info)
+}
+
+func (rel *testRaftEventListener) get() []raftio.LeaderInfo {
+	rel.mu.Lock()
+	defer rel.mu.Unlock()
+	r := make([]raftio.LeaderInfo, 0)
+	return append(r, rel.received...)
+}
+
+func TestRaftEventsAreReported(t *testing.T) {
+	fs := vfs.GetTestFS()
+	rel := &testRaftEventListener{
+		received: make([]raftio.LeaderInfo, 0),
+	}
+	to := &testOption{
+		defaultTestNode: true,
+		updateNodeHostConfig: func(nh *config.NodeHostConfig) *config.NodeHostConfig {
+			nh.RaftEventListener = rel
+			return nh
+		},
+		tf: func(nh *NodeHost) {
+			pto := pto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			if err := nh.SyncRequestAddReplica(ctx, 1, 2, "127.0.0.1:8080", 0); err != nil {
+				t.Fatalf("add node failed %v", err)
 			}
-			if !removed {
-				t.Fatalf("failed to remove node data")
-			}
-			marked, err := fileutil.IsDirMarkedAsDeleted(snapshotDir, fs)
-			if err != nil {
-				t.Fatalf("%v", err)
-			}
-			if !marked {
-				t.Fatalf("snapshot dir %s still exist", snapshotDir)
-			}
-			files, err = fs.List(snapshotDir)
-			if err != nil {
-				t.Fatalf("failed to read dir %v", err)
-			}
-			for _, fn := range files {
-				fi, err := fs.Stat(fs.PathJoin(snapshotDir, fn))
-				if err != nil {
-					t.Fatalf("failed to get stat for %s", fn)
-				}
-				if !fi.IsDir() {
-					continue
+			cancel()
+			var received []raftio.LeaderInfo
+			for i := 0; i < 1000; i++ {
+				received = rel.get()
+				if len(received) >= 4 {
+					break
 				}
-				if server.SnapshotDirNameRe.Match([]byte(fi.Name())) {
-					t.Fatalf("failed to delete the snapshot dir %s", fi.Name())
+				time.Sleep(10 * time.Millisecond)
+				if i == 999 {
+					t.Fatalf("failed to get the second LeaderUpdated notification")
 				}
 			}
-			bs, err := logdb.GetBootstrapInfo(1, 1)
-			if !errors.Is(err, raftio.ErrNoBootstrapInfo) {
-				t.Fatalf("failed to delete bootstrap %v", err)
-			}
-			if !reflect.DeepEqual(bs, pb.Bootstrap{}) {
-				t.Fatalf("bs not nil")
-			}
-			ents, sz, err := logdb.IterateEntries(nil, 0, 1, 1, 0,
-				math.MaxUint64, math.MaxUint64)
-			if err != nil {
-				t.Fatalf("failed to get entries %v", err)
-			}
-			if len(ents) != 0 || sz != 0 {
-				t.Fatalf("entry returned")
+			exp0 := raftio.LeaderInfo{
+				ShardID:   1,
+				ReplicaID: 1,
+				LeaderID:  raftio.NoLeader,
+				Term:      1,
 			}
-			snapshot, err = logdb.GetSnapshot(1, 1)
-			if err != nil {
-				t.Fatalf("%v", err)
+			exp1 := raftio.LeaderInfo{
+				ShardID:   1,
+				ReplicaID: 1,
+				LeaderID:  raftio.NoLeader,
+				Term:      2,
 			}
-			if !pb.IsEmptySnapshot(snapshot) {
-				t.Fatalf("snapshot not deleted")
+			exp2 := raftio.LeaderInfo{
+				ShardID:   1,
+				ReplicaID: 1,
+				LeaderID:  1,
+				Term:      2,
 			}
-			_, err = logdb.ReadRaftState(1, 1, 1)
-			if !errors.Is(err, raftio.ErrNoSavedLog) {
-				t.Fatalf("raft state not deleted %v", err)
+			exp3 := raftio.LeaderInfo{
+				ShardID:   1,
+				ReplicaID: 1,
+				LeaderID:  raftio.NoLeader,
+				Term:      2,
 			}
-			sysop, err := nh.RequestCompaction(1, 1)
-			if err != nil {
-				t.Fatalf("failed to request compaction %v", err)
+			expected := []raftio.LeaderInfo{exp0, exp1, exp2, exp3}
+			for idx := range expected {
+				if !reflect.DeepEqual(&(received[idx]), &expected[idx]) {
+					t.Errorf("unexpecded leader info, %d, %v, %v",
+						idx, received[idx], expected[idx])
+				}
 			}
-			<-sysop.ResultC()
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestSnapshotOptionIsChecked(t *testing.T) {
+func TestV2DataCanBeHandled(t *testing.T) {
 	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			opts := SnapshotOption{
-				OverrideCompactionOverhead: true,
-				CompactionIndex:            100,
-				CompactionOverhead:         10,
-			}
-			assert.Equal(t, ErrInvalidOption, opts.Validate())
-			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-			defer cancel()
-			_, err := nh.SyncRequestSnapshot(ctx, 1, opts)
-			assert.Equal(t, ErrInvalidOption, err)
-			rs, err := nh.RequestSnapshot(1, opts, time.Second)
-			assert.Equal(t, ErrInvalidOption, err)
-			assert.Nil(t, rs)
-		},
+	if vfs.GetTestFS() != vfs.DefaultFS {
+		t.Skip("skipped as not using the default fs")
 	}
-	runNodeHostTest(t, to, fs)
-}
-
-func TestSnapshotCanBeExported(t *testing.T) {
-	fs := vfs.GetTestFS()
+	v2datafp := "internal/logdb/testdata/v2-rocksdb-batched.tar.bz2"
+	targetDir := "test-v2-data-safe-to-remove"
+	if err := fs.RemoveAll(targetDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(targetDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	topDirName := "single_nodehost_test_dir_safe_to_delete"
+	testHostname := "lindfield.local"
+	if err := fileutil.ExtractTarBz2(v2datafp, targetDir, fs); err != nil {
+		t.Fatalf("%v", err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("failed to get hostname %v", err)
+	}
+	testPath := fs.PathJoin(targetDir, topDirName, testHostname)
+	expPath := fs.PathJoin(targetDir, topDirName, hostname)
+	if expPath != testPath {
+		if err := fs.Rename(testPath, expPath); err != nil {
+			t.Fatalf("failed to rename the dir %v", err)
+		}
+	}
+	v2dataDir := fs.PathJoin(targetDir, topDirName)
 	to := &testOption{
-		defaultTestNode: true,
+		noElection: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.WALDir = v2dataDir
+			c.NodeHostDir = v2dataDir
+			return c
+		},
 		tf: func(nh *NodeHost) {
-			sspath := "exported_snapshot_safe_to_delete"
-			if err := fs.RemoveAll(sspath); err != nil {
-				t.Fatalf("%v", err)
-			}
-			if err := fs.MkdirAll(sspath, 0755); err != nil {
-				t.Fatalf("%v", err)
-			}
-			defer func() {
-				if err := fs.RemoveAll(sspath); err != nil {
-					t.Fatalf("%v", err)
-				}
-			}()
-			session := nh.GetNoOPSession(1)
-			pto := lpto(nh)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			cmd := make([]byte, 1518)
-			_, err := nh.SyncPropose(ctx, session, cmd)
-			cancel()
-			if err != nil {
-				t.Fatalf("failed to make proposal %v", err)
-			}
-			opt := SnapshotOption{
-				Exported:   true,
-				ExportPath: sspath,
-			}
-			sr, err := nh.RequestSnapshot(1, opt, pto)
-			if err != nil {
-				t.Errorf("failed to request snapshot")
-			}
-			var index uint64
-			v := <-sr.ResultC()
-			if !v.Completed() {
-				t.Fatalf("failed to complete the requested snapshot")
+			name := nh.mu.logdb.Name()
+			if name != "sharded-pebble" {
+				// v2-rocksdb-batched.tar.bz2 contains rocksdb format data
+				t.Skip("skipped as not using rocksdb compatible logdb")
 			}
-			index = v.SnapshotIndex()
 			logdb := nh.mu.logdb
-			snapshot, err := logdb.GetSnapshot(1, 1)
-			if err != nil {
-				t.Fatalf("%v", err)
-			}
-			// exported snapshot is not managed by the system
-			if !pb.IsEmptySnapshot(snapshot) {
-				t.Fatalf("snapshot record unexpectedly inserted into the system")
-			}
-			snapshotDir := fmt.Sprintf("snapshot-%016X", index)
-			snapshotFile := fmt.Sprintf("snapshot-%016X.gbsnap", index)
-			fp := fs.PathJoin(sspath, snapshotDir, snapshotFile)
-			exist, err := fileutil.Exist(fp, fs)
-			if err != nil {
-				t.Fatalf("%v", err)
-			}
-			if !exist {
-				t.Errorf("snapshot file not saved")
-			}
-			metafp := fs.PathJoin(sspath, snapshotDir, "snapshot.metadata")
-			exist, err = fileutil.Exist(metafp, fs)
+			rs, err := logdb.ReadRaftState(2, 1, 0)
 			if err != nil {
-				t.Fatalf("%v", err)
-			}
-			if !exist {
-				t.Errorf("snapshot metadata not saved")
-			}
-			var ss pb.Snapshot
-			if err := fileutil.GetFlagFileContent(fs.PathJoin(sspath, snapshotDir),
-				"snapshot.metadata", &ss, fs); err != nil {
-				t.Fatalf("failed to get snapshot from its metadata file")
-			}
-			if ss.OnDiskIndex != 0 {
-				t.Errorf("on disk index is not 0")
-			}
-			if ss.Imported {
-				t.Errorf("incorrectly recorded as imported")
+				t.Fatalf("failed to get raft state %v", err)
 			}
-			if ss.Type != pb.RegularStateMachine {
-				t.Errorf("incorrect type")
+			if rs.EntryCount != 3 || rs.State.Commit != 3 {
+				t.Errorf("unexpected rs value")
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestOnDiskStateMachineCanExportSnapshot(t *testing.T) {
+func TestSnapshotCanBeCompressed(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
-		fakeDiskNode: true,
+		compressed: true,
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &tests.VerboseSnapshotSM{}
+		},
 		tf: func(nh *NodeHost) {
-			session := nh.GetNoOPSession(1)
-			proposed := false
-			for i := 0; i < 16; i++ {
-				pto := pto(nh)
-				ctx, cancel := context.WithTimeout(context.Background(), pto)
-				_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
-				cancel()
-				if err == nil {
-					proposed = true
-					break
-				} else {
-					time.Sleep(100 * time.Millisecond)
-				}
-			}
-			if !proposed {
-				t.Fatalf("failed to make proposal")
-			}
-			sspath := "exported_snapshot_safe_to_delete"
-			if err := fs.RemoveAll(sspath); err != nil {
-				t.Fatalf("%v", err)
-			}
-			if err := fs.MkdirAll(sspath, 0755); err != nil {
-				t.Fatalf("%v", err)
-			}
-			defer func() {
-				if err := fs.RemoveAll(sspath); err != nil {
-					t.Fatalf("%v", err)
-				}
-			}()
-			opt := SnapshotOption{
-				Exported:   true,
-				ExportPath: sspath,
-			}
-			aborted := false
-			index := uint64(0)
 			pto := lpto(nh)
-			for {
-				sr, err := nh.RequestSnapshot(1, opt, pto)
-				if err == ErrRejected {
-					continue
-				}
-				if err != nil {
-					t.Fatalf("failed to request snapshot %v", err)
-				}
-				v := <-sr.ResultC()
-				if v.Aborted() {
-					aborted = true
-					continue
-				}
-				if v.code == requestRejected {
-					continue
-				}
-				if !v.Completed() {
-					t.Fatalf("failed to complete the requested snapshot, %s", v.code)
-				}
-				index = v.SnapshotIndex()
-				break
-			}
-			if !aborted {
-				t.Fatalf("never aborted")
-			}
-			logdb := nh.mu.logdb
-			snapshot, err := logdb.GetSnapshot(1, 1)
-			if err != nil {
-				t.Fatalf("%v", err)
-			}
-			if !pb.IsEmptySnapshot(snapshot) {
-				t.Fatalf("snapshot record unexpectedly inserted into the system")
-			}
-			snapshotDir := fmt.Sprintf("snapshot-%016X", index)
-			snapshotFile := fmt.Sprintf("snapshot-%016X.gbsnap", index)
-			fp := fs.PathJoin(sspath, snapshotDir, snapshotFile)
-			exist, err := fileutil.Exist(fp, fs)
-			if err != nil {
-				t.Fatalf("%v", err)
-			}
-			if !exist {
-				t.Errorf("snapshot file not saved")
-			}
-			metafp := fs.PathJoin(sspath, snapshotDir, "snapshot.metadata")
-			exist, err = fileutil.Exist(metafp, fs)
-			if err != nil {
-				t.Fatalf("%v", err)
-			}
-			if !exist {
-				t.Errorf("snapshot metadata not saved")
-			}
-			shrunk, err := rsm.IsShrunkSnapshotFile(fp, fs)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			_, err := nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption)
+			cancel()
 			if err != nil {
-				t.Fatalf("%v", err)
-			}
-			if shrunk {
-				t.Errorf("exported snapshot is considered as shrunk")
-			}
-			var ss pb.Snapshot
-			if err := fileutil.GetFlagFileContent(fs.PathJoin(sspath, snapshotDir),
-				"snapshot.metadata", &ss, fs); err != nil {
-				t.Fatalf("failed to get snapshot from its metadata file")
+				t.Fatalf("failed to request snapshot %v", err)
 			}
-			if ss.OnDiskIndex == 0 {
-				t.Errorf("on disk index is not recorded")
+			logdb := nh.mu.logdb
+			ss, err := logdb.GetSnapshot(1, 1)
+			if err != nil {
+				t.Fatalf("failed to list snapshots: %v", err)
 			}
-			if ss.Imported {
-				t.Errorf("incorrectly recorded as imported")
+			if pb.IsEmptySnapshot(ss) {
+				t.Fatalf("failed to get snapshot rec")
 			}
-			if ss.Type != pb.OnDiskStateMachine {
-				t.Errorf("incorrect type")
+			fi, err := fs.Stat(ss.Filepath)
+			if err != nil {
+				t.Fatalf("failed to get file path %v", err)
+			}
+			if fi.Size() > 1024*364 {
+				t.Errorf("snapshot file not compressed, sz %d", fi.Size())
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func testImportedSnapshotIsAlwaysRestored(t *testing.T,
-	newDir bool, ct config.CompressionType, fs vfs.IFS) {
+func makeProposals(nh *NodeHost) {
+	session := nh.GetNoOPSession(1)
+	pto := pto(nh)
+	for i := 0; i < 16; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), pto)
+		_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
+		cancel()
+		if err != nil {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+func testWitnessIO(t *testing.T,
+	witnessTestFunc func(*NodeHost, *NodeHost, *tests.SimDiskSM), fs vfs.IFS) {
 	tf := func() {
 		rc := config.Config{
-			ShardID:                 1,
-			ReplicaID:               1,
-			ElectionRTT:             3,
-			HeartbeatRTT:            1,
-			CheckQuorum:             true,
-			SnapshotEntries:         5,
-			CompactionOverhead:      2,
-			SnapshotCompressionType: ct,
+			ShardID:      1,
+			ReplicaID:    1,
+			ElectionRTT:  3,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
 		}
 		peers := make(map[uint64]string)
 		peers[1] = nodeHostTestAddr1
-		nhc := config.NodeHostConfig{
-			NodeHostDir:    singleNodeHostTestDir,
-			RTTMillisecond: getRTTMillisecond(fs, singleNodeHostTestDir),
+		dir := fs.PathJoin(singleNodeHostTestDir, "nh1")
+		nhc1 := config.NodeHostConfig{
+			NodeHostDir:    dir,
+			RTTMillisecond: getRTTMillisecond(fs, dir),
 			RaftAddress:    nodeHostTestAddr1,
 			Expert:         getTestExpertConfig(fs),
 		}
-		nh, err := NewNodeHost(nhc)
+		nh1, err := NewNodeHost(nhc1)
 		if err != nil {
 			t.Fatalf("failed to create node host %v", err)
 		}
-		pto := lpto(nh)
+		defer nh1.Close()
 		newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
 			return tests.NewSimDiskSM(0)
 		}
-		if err := nh.StartOnDiskReplica(peers, false, newSM, rc); err != nil {
+		if err := nh1.StartOnDiskReplica(peers, false, newSM, rc); err != nil {
 			t.Fatalf("failed to start shard %v", err)
 		}
-		waitForLeaderToBeElected(t, nh, 1)
-		makeProposals := func(nn *NodeHost) {
-			session := nn.GetNoOPSession(1)
-			for i := 0; i < 16; i++ {
-				ctx, cancel := context.WithTimeout(context.Background(), pto)
-				_, err := nn.SyncPropose(ctx, session, []byte("test-data"))
-				cancel()
-				if err != nil {
-					t.Errorf("failed to make proposal %v", err)
-				}
-			}
-		}
-		makeProposals(nh)
-		sspath := "exported_snapshot_safe_to_delete"
-		if err := fs.RemoveAll(sspath); err != nil {
-			t.Fatalf("%v", err)
-		}
-		if err := fs.MkdirAll(sspath, 0755); err != nil {
-			t.Fatalf("%v", err)
-		}
-		defer func() {
-			if err := fs.RemoveAll(sspath); err != nil {
-				t.Fatalf("%v", err)
-			}
-		}()
-		opt := SnapshotOption{
-			Exported:   true,
-			ExportPath: sspath,
-		}
-		var index uint64
-		for i := 0; i < 1000; i++ {
-			if i == 999 {
-				t.Fatalf("failed to export snapshot")
-			}
-			sr, err := nh.RequestSnapshot(1, opt, pto)
-			if err != nil {
+		waitForLeaderToBeElected(t, nh1, 1)
+		for i := 0; i < 8; i++ {
+			makeProposals(nh1)
+			pto := lpto(nh1)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			opt := SnapshotOption{OverrideCompactionOverhead: true, CompactionOverhead: 1}
+			if _, err := nh1.SyncRequestSnapshot(ctx, 1, opt); err != nil {
 				t.Fatalf("failed to request snapshot %v", err)
 			}
-			v := <-sr.ResultC()
-			if v.Rejected() {
-				time.Sleep(10 * time.Millisecond)
-				continue
-			}
-			if v.Completed() {
-				index = v.SnapshotIndex()
-				break
-			}
+			cancel()
 		}
-		makeProposals(nh)
+		pto := pto(nh1)
 		ctx, cancel := context.WithTimeout(context.Background(), pto)
-		rv, err := nh.SyncRead(ctx, 1, nil)
+		if err := nh1.SyncRequestAddWitness(ctx, 1, 2, nodeHostTestAddr2, 0); err != nil {
+			t.Fatalf("failed to add witness %v", err)
+		}
 		cancel()
+		rc2 := rc
+		rc2.ReplicaID = 2
+		rc2.IsWitness = true
+		nhc2 := nhc1
+		nhc2.RaftAddress = nodeHostTestAddr2
+		nhc2.NodeHostDir = fs.PathJoin(singleNodeHostTestDir, "nh2")
+		nh2, err := NewNodeHost(nhc2)
 		if err != nil {
-			t.Fatalf("failed to read applied value %v", err)
-		}
-		applied := rv.(uint64)
-		if applied <= index {
-			t.Fatalf("invalid applied value %d", applied)
-		}
-		ctx, cancel = context.WithTimeout(context.Background(), pto)
-		if err := nh.SyncRequestAddReplica(ctx, 1, 2, "noidea:8080", 0); err != nil {
-			t.Fatalf("failed to add node %v", err)
-		}
-		nh.Close()
-		snapshotDir := fmt.Sprintf("snapshot-%016X", index)
-		dir := fs.PathJoin(sspath, snapshotDir)
-		members := make(map[uint64]string)
-		members[1] = nhc.RaftAddress
-		if newDir {
-			nhc.NodeHostDir = fs.PathJoin(nhc.NodeHostDir, "newdir")
-		}
-		if err := tools.ImportSnapshot(nhc, dir, members, 1); err != nil {
-			t.Fatalf("failed to import snapshot %v", err)
+			t.Fatalf("failed to create node host %v", err)
 		}
-		ok, err := upgrade310.CanUpgradeToV310(nhc)
-		if err != nil {
-			t.Errorf("failed to check whether upgrade is possible")
+		defer nh2.Close()
+		witness := tests.NewSimDiskSM(0)
+		newWitness := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return witness
 		}
-		if ok {
-			t.Errorf("should not be considered as ok to upgrade")
+		if err := nh2.StartOnDiskReplica(nil, true, newWitness, rc2); err != nil {
+			t.Fatalf("failed to start shard %v", err)
 		}
-		func() {
-			rnh, err := NewNodeHost(nhc)
-			if err != nil {
-				t.Fatalf("failed to create node host %v", err)
-			}
-			defer rnh.Close()
-			rnewSM := func(uint64, uint64) sm.IOnDiskStateMachine {
-				return tests.NewSimDiskSM(applied)
-			}
-			if err := rnh.StartOnDiskReplica(nil, false, rnewSM, rc); err != nil {
-				t.Fatalf("failed to start shard %v", err)
+		waitForLeaderToBeElected(t, nh2, 1)
+		witnessTestFunc(nh1, nh2, witness)
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
+func TestWitnessSnapshotIsCorrectlyHandled(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(nh1 *NodeHost, nh2 *NodeHost, witness *tests.SimDiskSM) {
+		for {
+			if witness.GetRecovered() > 0 {
+				t.Fatalf("unexpected recovered count %d", witness.GetRecovered())
 			}
-			waitForLeaderToBeElected(t, rnh, 1)
-			ctx, cancel = context.WithTimeout(context.Background(), pto)
-			rv, err = rnh.SyncRead(ctx, 1, nil)
-			cancel()
+			snapshot, err := nh2.mu.logdb.GetSnapshot(1, 2)
 			if err != nil {
-				t.Fatalf("failed to read applied value %v", err)
+				t.Fatalf("%v", err)
 			}
-			if index != rv.(uint64) {
-				t.Fatalf("invalid returned value %d", rv.(uint64))
+			if pb.IsEmptySnapshot(snapshot) {
+				time.Sleep(100 * time.Millisecond)
+			} else {
+				if !snapshot.Witness {
+					t.Errorf("not a witness snapshot")
+				}
+				return
 			}
-			makeProposals(rnh)
-		}()
-		ok, err = upgrade310.CanUpgradeToV310(nhc)
-		if err != nil {
-			t.Errorf("failed to check whether upgrade is possible")
-		}
-		if !ok {
-			t.Errorf("can not upgrade")
 		}
 	}
-	runNodeHostTestDC(t, tf, true, fs)
+	testWitnessIO(t, tf, fs)
 }
 
-func TestImportedSnapshotIsAlwaysRestored(t *testing.T) {
-	if vfs.GetTestFS() != vfs.DefaultFS {
-		t.Skip("not using the default fs")
-	} else {
-		fs := vfs.GetTestFS()
-		testImportedSnapshotIsAlwaysRestored(t, true, config.NoCompression, fs)
-		testImportedSnapshotIsAlwaysRestored(t, false, config.NoCompression, fs)
-		testImportedSnapshotIsAlwaysRestored(t, false, config.Snappy, fs)
+func TestWitnessCanReplicateEntries(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(nh1 *NodeHost, nh2 *NodeHost, witness *tests.SimDiskSM) {
+		for i := 0; i < 8; i++ {
+			makeProposals(nh1)
+		}
+		if witness.GetApplied() > 0 {
+			t.Fatalf("unexpected applied count %d", witness.GetApplied())
+		}
 	}
+	testWitnessIO(t, tf, fs)
 }
 
-func TestShardWithoutQuorumCanBeRestoreByImportingSnapshot(t *testing.T) {
+func TestWitnessCanBePromotedToRegularNode(t *testing.T) {
 	fs := vfs.GetTestFS()
-	tf := func() {
-		nh1dir := fs.PathJoin(singleNodeHostTestDir, "nh1")
-		nh2dir := fs.PathJoin(singleNodeHostTestDir, "nh2")
-		rc := config.Config{
-			ShardID:            1,
-			ReplicaID:          1,
-			ElectionRTT:        10,
-			HeartbeatRTT:       1,
-			CheckQuorum:        true,
-			SnapshotEntries:    5,
-			CompactionOverhead: 2,
-		}
-		peers := make(map[uint64]string)
-		peers[1] = nodeHostTestAddr1
-		nhc1 := config.NodeHostConfig{
-			WALDir:         nh1dir,
-			NodeHostDir:    nh1dir,
-			RTTMillisecond: getRTTMillisecond(fs, nh1dir),
-			RaftAddress:    nodeHostTestAddr1,
-			Expert:         getTestExpertConfig(fs),
-		}
-		nhc2 := config.NodeHostConfig{
-			WALDir:         nh2dir,
-			NodeHostDir:    nh2dir,
-			RTTMillisecond: getRTTMillisecond(fs, nh2dir),
-			RaftAddress:    nodeHostTestAddr2,
-			Expert:         getTestExpertConfig(fs),
+	tf := func(nh1 *NodeHost, nh2 *NodeHost, witness *tests.SimDiskSM) {
+		makeProposals(nh1)
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh1))
+		if err := nh1.SyncRequestPromoteWitness(ctx, 1, 1, 0); err != ErrInvalidOperation {
+			t.Fatalf("promoting regular node not rejected, %v", err)
 		}
-		var once sync.Once
-		nh1, err := NewNodeHost(nhc1)
-		if err != nil {
-			t.Fatalf("failed to create node host %v", err)
+		cancel()
+		ctx, cancel = context.WithTimeout(context.Background(), pto(nh1))
+		if err := nh1.SyncRequestPromoteWitness(ctx, 1, 2, 0); err != nil {
+			t.Fatalf("failed to promote witness %v", err)
 		}
-		nh2, err := NewNodeHost(nhc2)
+		cancel()
+		ctx, cancel = context.WithTimeout(context.Background(), pto(nh1))
+		m, err := nh1.SyncGetShardMembership(ctx, 1)
+		cancel()
 		if err != nil {
-			t.Fatalf("failed to create node host %v", err)
+			t.Fatalf("failed to get membership %v", err)
 		}
-		sm1 := tests.NewFakeDiskSM(0)
-		sm1.SetAborted()
-		newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
-			return sm1
+		if _, ok := m.Nodes[2]; !ok || len(m.Witnesses) != 0 {
+			t.Fatalf("unexpected membership %+v", m)
 		}
-		newSM2 := func(uint64, uint64) sm.IOnDiskStateMachine {
-			return tests.NewFakeDiskSM(0)
+		// the witness stops itself once the promotion is applied
+		for i := 0; ; i++ {
+			if _, ok := nh2.getShard(1); !ok {
+				break
+			}
+			if i > 100 {
+				t.Fatalf("promoted witness not stopped")
+			}
+			time.Sleep(100 * time.Millisecond)
 		}
-		if err := nh1.StartOnDiskReplica(peers, false, newSM, rc); err != nil {
-			t.Fatalf("failed to start shard %v", err)
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    2,
+			ElectionRTT:  3,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
+			IsWitness:    true,
 		}
-		waitForLeaderToBeElected(t, nh1, 1)
-		defer func() {
-			if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
-				t.Fatalf("%v", err)
+		newWitness := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return witness
+		}
+		for i := 0; ; i++ {
+			err := nh2.StartOnDiskReplica(nil, true, newWitness, rc)
+			if err == ErrInvalidShardSettings {
+				break
 			}
-		}()
-		defer once.Do(func() {
-			nh1.Close()
-			nh2.Close()
-		})
-		session := nh1.GetNoOPSession(1)
-		mkproposal := func(nh *NodeHost) {
-			done := false
-			pto := pto(nh)
-			for i := 0; i < 100; i++ {
-				ctx, cancel := context.WithTimeout(context.Background(), pto)
-				_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
+			if err != ErrShardAlreadyExist || i > 100 {
+				t.Fatalf("promoted witness restarted as witness, %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		rc.IsWitness = false
+		promoted := tests.NewSimDiskSM(0)
+		newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return promoted
+		}
+		for i := 0; ; i++ {
+			err := nh2.StartOnDiskReplica(nil, true, newSM, rc)
+			if err == nil {
+				break
+			}
+			if err != ErrShardAlreadyExist || i > 100 {
+				t.Fatalf("failed to restart promoted witness %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		for i := 0; ; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh2))
+			result, err := nh2.SyncRead(ctx, 1, nil)
+			cancel()
+			if err == nil {
+				if result.(uint64) == 0 {
+					t.Fatalf("state machine not restored")
+				}
+				break
+			}
+			if i > 100 {
+				t.Fatalf("failed to read from promoted witness %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if promoted.GetRecovered() == 0 {
+			t.Errorf("promoted witness not recovered from snapshot")
+		}
+		// the last index of the witness log is kept so the promoted witness
+		// doesn't vote before catching up
+		bi, err := nh2.mu.logdb.GetBootstrapInfo(1, 2)
+		if err != nil {
+			t.Fatalf("failed to get bootstrap info %v", err)
+		}
+		if bi.Promoted || bi.WitnessIndex == 0 || bi.WitnessTerm == 0 {
+			t.Errorf("witness log not recorded, %+v", bi)
+		}
+	}
+	testWitnessIO(t, tf, fs)
+}
+
+func TestReplicaCanBeMovedToNewAddress(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := make(map[uint64]string)
+		for i := range nhs {
+			members[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		startCloneTestShard(t, nhs, 1, []uint64{1, 2, 3}, members)
+		propose := func(cmd string) {
+			for i := 0; ; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[0]))
+				_, err := nhs[0].SyncPropose(ctx, nhs[0].GetNoOPSession(1), []byte(cmd))
 				cancel()
 				if err == nil {
-					done = true
-					break
-				} else {
-					time.Sleep(200 * time.Millisecond)
+					return
 				}
+				if i > 100 {
+					t.Fatalf("failed to propose %v", err)
+				}
+				time.Sleep(100 * time.Millisecond)
 			}
-			if !done {
-				t.Fatalf("failed to make proposal on restored shard")
+		}
+		update := func(address string) error {
+			for i := 0; ; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[0]))
+				err := nhs[0].SyncRequestUpdateReplicaAddress(ctx, 1, 3, address, 0)
+				cancel()
+				if (!errors.Is(err, ErrShardNotReady) &&
+					!errors.Is(err, ErrTimeout)) || i > 100 {
+					return err
+				}
+				time.Sleep(100 * time.Millisecond)
 			}
 		}
-		mkproposal(nh1)
-		sspath := "exported_snapshot_safe_to_delete"
-		if err := fs.RemoveAll(sspath); err != nil {
-			t.Fatalf("%v", err)
+		propose("a=1")
+		nhc := nhs[2].NodeHostConfig()
+		nhs[2].Close()
+		if err := update(memtransport.Address(1)); !errors.Is(err, ErrAddressInUse) {
+			t.Fatalf("address in use not rejected, %v", err)
 		}
-		if err := fs.MkdirAll(sspath, 0755); err != nil {
-			t.Fatalf("%v", err)
+		if err := update(memtransport.Address(4)); err != nil {
+			t.Fatalf("failed to update address %v", err)
 		}
-		defer func() {
-			if err := fs.RemoveAll(sspath); err != nil {
-				t.Fatalf("%v", err)
-			}
-		}()
-		opt := SnapshotOption{
-			Exported:   true,
-			ExportPath: sspath,
+		if err := update(memtransport.Address(3)); !errors.Is(err, ErrRejected) {
+			t.Fatalf("retired address not rejected, %v", err)
 		}
-		pto := lpto(nh1)
-		sr, err := nh1.RequestSnapshot(1, opt, pto)
+		propose("b=2")
+		nhc.RaftAddress = memtransport.Address(4)
+		if _, err := NewNodeHost(nhc); !errors.Is(err, server.ErrNotOwner) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if err := tools.ChangeRaftAddress(nhc,
+			memtransport.Address(3)); err != nil {
+			t.Fatalf("failed to change address %v", err)
+		}
+		listener := &testSysEventListener{}
+		nhc.SystemEventListener = listener
+		nh, err := NewNodeHost(nhc)
 		if err != nil {
-			t.Fatalf("failed to request snapshot %v", err)
+			t.Fatalf("failed to create NodeHost %v", err)
 		}
-		var index uint64
-		v := <-sr.ResultC()
-		if !v.Completed() {
-			t.Fatalf("failed to complete the requested snapshot")
+		nhs[2] = nh
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    3,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
 		}
-		index = v.SnapshotIndex()
-		snapshotDir := fmt.Sprintf("snapshot-%016X", index)
-		dir := fs.PathJoin(sspath, snapshotDir)
-		members := make(map[uint64]string)
-		members[1] = nhc1.RaftAddress
-		members[10] = nhc2.RaftAddress
-		once.Do(func() {
-			nh1.Close()
-			nh2.Close()
-		})
-		if err := tools.ImportSnapshot(nhc1, dir, members, 1); err != nil {
-			t.Fatalf("failed to import snapshot %v", err)
+		if err := nh.StartReplica(nil, false, newCloneTestSM, rc); err != nil {
+			t.Fatalf("failed to restart replica %v", err)
 		}
-		if err := tools.ImportSnapshot(nhc2, dir, members, 10); err != nil {
-			t.Fatalf("failed to import snapshot %v", err)
+		propose("c=3")
+		waitForTestLastApplied(t, nh, getTestLastApplied(nhs[0]))
+		for key, value := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+			v, err := nh.StaleRead(1, key)
+			if err != nil {
+				t.Fatalf("stale read failed %v", err)
+			}
+			if v.(string) != value {
+				t.Errorf("key %s, value %s, want %s", key, v, value)
+			}
 		}
-		rnh1, err := NewNodeHost(nhc1)
-		if err != nil {
-			t.Fatalf("failed to create node host %v", err)
+		if len(listener.getSnapshotReceived()) != 0 {
+			t.Errorf("moved replica received snapshot")
 		}
-		rnh2, err := NewNodeHost(nhc2)
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[0]))
+		defer cancel()
+		m, err := nhs[0].SyncGetShardMembership(ctx, 1)
 		if err != nil {
-			t.Fatalf("failed to create node host %v", err)
-		}
-		defer func() {
-			rnh1.Close()
-			rnh2.Close()
-		}()
-		if err := rnh1.StartOnDiskReplica(nil, false, newSM, rc); err != nil {
-			t.Fatalf("failed to start shard %v", err)
+			t.Fatalf("failed to get membership %v", err)
 		}
-		rc.ReplicaID = 10
-		if err := rnh2.StartOnDiskReplica(nil, false, newSM2, rc); err != nil {
-			t.Fatalf("failed to start shard %v", err)
+		if m.Nodes[3] != memtransport.Address(4) || len(m.Nodes) != 3 {
+			t.Errorf("unexpected membership %+v", m)
 		}
-		waitForLeaderToBeElected(t, rnh1, 1)
-		mkproposal(rnh1)
-		mkproposal(rnh2)
 	}
-	runNodeHostTestDC(t, tf, true, fs)
-}
-
-type chunks struct {
-	received  uint64
-	confirmed uint64
-}
-
-var (
-	testSnapshotDir = "test_snapshot_dir_safe_to_delete"
-)
-
-func (c *chunks) onReceive(pb.MessageBatch) {
-	c.received++
-}
-
-func (c *chunks) confirm(shardID uint64, replicaID uint64, index uint64) {
-	c.confirmed++
-}
-
-func (c *chunks) getSnapshotDirFunc(shardID uint64, replicaID uint64) string {
-	return testSnapshotDir
-}
-
-type testSink2 struct {
-	receiver chunkReceiver
-}
-
-func (s *testSink2) Receive(chunk pb.Chunk) (bool, bool) {
-	s.receiver.Add(chunk)
-	return true, false
-}
-
-func (s *testSink2) Close() error {
-	s.Receive(pb.Chunk{ChunkCount: pb.PoisonChunkCount})
-	return nil
-}
-
-func (s *testSink2) ShardID() uint64 {
-	return 2000
+	memTransportNodeHostTest(t, 3, tf, fs)
 }
 
-func (s *testSink2) ToReplicaID() uint64 {
-	return 300
+func TestWitnessFarBehindIsRecoveredWithoutChunks(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		startMemTransportShard(t, nhs[:2], 1)
+		chunks := uint64(0)
+		for _, nh := range nhs {
+			tt := nh.transport.(*transport.Transport)
+			tt.SetPreStreamChunkSendHook(func(c pb.Chunk) (pb.Chunk, bool) {
+				atomic.AddUint64(&chunks, 1)
+				return c, true
+			})
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[0]))
+		err := nhs[0].SyncRequestAddWitness(ctx, 1, 3, memtransport.Address(3), 0)
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to add witness %v", err)
+		}
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    3,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
+			IsWitness:    true,
+		}
+		createSM := func(uint64, uint64) sm.IStateMachine {
+			return &PST{}
+		}
+		if err := nhs[2].StartReplica(nil, true, createSM, rc); err != nil {
+			t.Fatalf("failed to start witness %v", err)
+		}
+		waitForLeaderToBeElected(t, nhs[2], 1)
+		network.Partition([]string{memtransport.Address(3)},
+			[]string{memtransport.Address(1), memtransport.Address(2)})
+		compacted := uint64(0)
+		for i := 0; i < 4; i++ {
+			if !makeTestProposal(nhs[0], 100) {
+				t.Fatalf("failed to make proposal")
+			}
+			for _, nh := range nhs[:2] {
+				ctx, cancel := context.WithTimeout(context.Background(), lpto(nh))
+				opt := SnapshotOption{
+					OverrideCompactionOverhead: true,
+					CompactionOverhead:         0,
+				}
+				index, err := nh.SyncRequestSnapshot(ctx, 1, opt)
+				cancel()
+				if err != nil {
+					t.Fatalf("failed to request snapshot %v", err)
+				}
+				compacted = index
+			}
+		}
+		network.Heal()
+		for i := 0; ; i++ {
+			ss, err := nhs[2].mu.logdb.GetSnapshot(1, 3)
+			if err != nil {
+				t.Fatalf("failed to get snapshot %v", err)
+			}
+			if ss.Index >= compacted {
+				if !ss.Witness {
+					t.Errorf("not a witness snapshot")
+				}
+				break
+			}
+			if i > 200 {
+				t.Fatalf("witness not recovered, index %d, want %d",
+					ss.Index, compacted)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if !makeTestProposal(nhs[0], 100) {
+			t.Fatalf("failed to make proposal")
+		}
+		if v := atomic.LoadUint64(&chunks); v != 0 {
+			t.Errorf("%d snapshot chunks sent", v)
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
 }
 
-type dataCorruptionSink struct {
-	receiver chunkReceiver
-	enabled  bool
+func waitForLeaderID(t *testing.T, nh *NodeHost, leaderID uint64) {
+	for i := 0; i < 200; i++ {
+		id, _, ok, err := nh.GetLeaderID(1)
+		if err == nil && ok && id == leaderID {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("replica %d is not the leader", leaderID)
 }
 
-func (s *dataCorruptionSink) Receive(chunk pb.Chunk) (bool, bool) {
-	if s.enabled && len(chunk.Data) > 0 {
-		idx := mrand.Uint64() % uint64(len(chunk.Data))
-		chunk.Data[idx] = chunk.Data[idx] + 1
+func getThreeReplicaTestPeers() map[uint64]string {
+	return map[uint64]string{
+		1: nodeHostTestAddr1,
+		2: nodeHostTestAddr2,
+		3: nodeHostTestAddr3,
 	}
-	s.receiver.Add(chunk)
-	return true, false
 }
 
-func (s *dataCorruptionSink) Close() error {
-	s.Receive(pb.Chunk{ChunkCount: pb.PoisonChunkCount})
-	return nil
+// startThreeReplicaTestShard starts the specified replica of a three replicas
+// shard on a new NodeHost instance.
+func startThreeReplicaTestShard(t *testing.T, fs vfs.IFS, rc config.Config,
+	rel raftio.IRaftEventListener) *NodeHost {
+	peers := getThreeReplicaTestPeers()
+	return startTestReplica(t, fs, rc, peers[rc.ReplicaID], peers, false, rel)
 }
 
-func (s *dataCorruptionSink) ShardID() uint64 {
-	return 2000
+// startTestReplica starts the specified replica on a new NodeHost instance
+// listening on the specified address.
+func startTestReplica(t *testing.T, fs vfs.IFS, rc config.Config,
+	addr string, peers map[uint64]string, join bool,
+	rel raftio.IRaftEventListener) *NodeHost {
+	dir := fs.PathJoin(singleNodeHostTestDir, fmt.Sprintf("nh%d", rc.ReplicaID))
+	nhc := config.NodeHostConfig{
+		NodeHostDir:       dir,
+		RTTMillisecond:    getRTTMillisecond(fs, dir),
+		RaftAddress:       addr,
+		Expert:            getTestExpertConfig(fs),
+		RaftEventListener: rel,
+	}
+	nh, err := NewNodeHost(nhc)
+	if err != nil {
+		t.Fatalf("failed to create node host %v", err)
+	}
+	newSM := func(uint64, uint64) sm.IStateMachine {
+		return &tests.NoOP{}
+	}
+	if err := nh.StartReplica(peers, join, newSM, rc); err != nil {
+		t.Fatalf("failed to start shard %v", err)
+	}
+	return nh
 }
 
-func (s *dataCorruptionSink) ToReplicaID() uint64 {
-	return 300
+func TestLeadershipReturnsToPreferredReplica(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		startReplica := func(replicaID uint64) *NodeHost {
+			rc := config.Config{
+				ShardID:                        1,
+				ReplicaID:                      replicaID,
+				ElectionRTT:                    10,
+				HeartbeatRTT:                   1,
+				CheckQuorum:                    true,
+				LeaderPreference:               map[uint64]uint64{1: 2, 2: 1},
+				LeaderPreferenceMinIntervalRTT: 20,
+			}
+			return startThreeReplicaTestShard(t, fs, rc, nil)
+		}
+		nh1 := startReplica(1)
+		nh2 := startReplica(2)
+		defer nh2.Close()
+		nh3 := startReplica(3)
+		defer nh3.Close()
+		waitForLeaderID(t, nh1, 1)
+		waitForLeaderID(t, nh2, 1)
+		nh1.Close()
+		// replica 2 is preferred over replica 3 once replica 1 is gone
+		waitForLeaderID(t, nh3, 2)
+		nh1 = startReplica(1)
+		defer nh1.Close()
+		waitForLeaderID(t, nh1, 1)
+		waitForLeaderID(t, nh3, 1)
+	}
+	runNodeHostTestDC(t, tf, true, fs)
 }
 
-type chunkReceiver interface {
-	Add(chunk pb.Chunk) bool
+func TestIsLeaderIsConsistentWithLeaderUpdated(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		var nhs []*NodeHost
+		var rels []*testRaftEventListener
+		for replicaID := uint64(1); replicaID <= 3; replicaID++ {
+			rc := config.Config{
+				ShardID:      1,
+				ReplicaID:    replicaID,
+				ElectionRTT:  10,
+				HeartbeatRTT: 1,
+			}
+			rel := &testRaftEventListener{}
+			rels = append(rels, rel)
+			nh := startThreeReplicaTestShard(t, fs, rc, rel)
+			defer nh.Close()
+			nhs = append(nhs, nh)
+		}
+		for _, target := range []uint64{1, 2, 3, 1, 3} {
+			leaderID := uint64(0)
+			for i := 0; i < 200; i++ {
+				id, _, ok, err := nhs[0].GetLeaderID(1)
+				if err == nil && ok {
+					leaderID = id
+					break
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			if leaderID != target {
+				if err := nhs[0].RequestLeaderTransfer(1, target); err != nil {
+					t.Fatalf("failed to request leader transfer %v", err)
+				}
+			}
+			for _, nh := range nhs {
+				waitForLeaderID(t, nh, target)
+			}
+			for idx, nh := range nhs {
+				_, term, _, err := nh.GetLeaderID(1)
+				if err != nil {
+					t.Fatalf("failed to get leader id %v", err)
+				}
+				isLeader, leaderTerm := nh.IsLeader(1)
+				replicaID := uint64(idx + 1)
+				if isLeader != (replicaID == target) {
+					t.Errorf("replica %d, IsLeader %t, leader %d",
+						replicaID, isLeader, target)
+				}
+				if isLeader && leaderTerm != term {
+					t.Errorf("term %d, want %d", leaderTerm, term)
+				}
+				if !isLeader && leaderTerm != 0 {
+					t.Errorf("unexpected term %d", leaderTerm)
+				}
+				// LeaderUpdated events are delivered asynchronously, the last one is
+				// expected to agree with IsLeader
+				var last raftio.LeaderInfo
+				for i := 0; i < 100; i++ {
+					if received := rels[idx].get(); len(received) > 0 {
+						last = received[len(received)-1]
+						if last.LeaderID == target && last.Term == term {
+							break
+						}
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				if last.LeaderID != target || last.Term != term {
+					t.Errorf("unexpected LeaderUpdated event %+v", last)
+				}
+			}
+		}
+	}
+	runNodeHostTestDC(t, tf, true, fs)
 }
 
-func getTestSSMeta() rsm.SSMeta {
-	return rsm.SSMeta{
-		Index: 1000,
-		Term:  5,
-		From:  150,
+func startDecommissionTestShard(t *testing.T, fs vfs.IFS) []*NodeHost {
+	var nhs []*NodeHost
+	for replicaID := uint64(1); replicaID <= 3; replicaID++ {
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    replicaID,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+		}
+		nhs = append(nhs, startThreeReplicaTestShard(t, fs, rc, nil))
 	}
+	for _, nh := range nhs {
+		waitForLeaderToBeElected(t, nh, 1)
+	}
+	return nhs
 }
 
-func testCorruptedChunkWriterOutputCanBeHandledByChunk(t *testing.T,
-	enabled bool, exp uint64, fs vfs.IFS) {
-	if err := fs.RemoveAll(testSnapshotDir); err != nil {
-		t.Fatalf("%v", err)
-	}
-	c := &chunks{}
-	if err := fs.MkdirAll(c.getSnapshotDirFunc(0, 0), 0755); err != nil {
-		t.Fatalf("%v", err)
+func checkReplicaDecommissioned(t *testing.T,
+	nhs []*NodeHost, replicaID uint64) {
+	nh := nhs[replicaID-1]
+	if _, _, _, err := nh.GetLeaderID(1); err != ErrShardNotFound {
+		t.Fatalf("replica not stopped, %v", err)
 	}
-	cks := transport.NewChunk(c.onReceive,
-		c.confirm, c.getSnapshotDirFunc, 0, fs)
-	sink := &dataCorruptionSink{receiver: cks, enabled: enabled}
-	meta := getTestSSMeta()
-	cw := rsm.NewChunkWriter(sink, meta)
-	defer func() {
-		if err := fs.RemoveAll(testSnapshotDir); err != nil {
-			t.Fatalf("%v", err)
-		}
-	}()
-	for i := 0; i < 10; i++ {
-		data := make([]byte, rsm.ChunkSize)
-		_, _ = rand.Read(data)
-		if _, err := cw.Write(data); err != nil {
-			t.Fatalf("failed to write the data %v", err)
-		}
+	newSM := func(uint64, uint64) sm.IStateMachine {
+		return &tests.NoOP{}
 	}
-	if err := cw.Close(); err != nil {
-		t.Fatalf("failed to flush %v", err)
+	rc := config.Config{
+		ShardID:      1,
+		ReplicaID:    replicaID,
+		ElectionRTT:  10,
+		HeartbeatRTT: 1,
 	}
-	if c.received != exp {
-		t.Fatalf("unexpected received count: %d, want %d", c.received, exp)
+	err := nh.StartReplica(getThreeReplicaTestPeers(), false, newSM, rc)
+	if err != ErrReplicaRemoved {
+		t.Fatalf("replica data not removed, %v", err)
 	}
-	if c.confirmed != exp {
-		t.Fatalf("unexpected confirmed count: %d, want %d", c.confirmed, exp)
+	for _, other := range nhs {
+		if other == nh {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), pto(other))
+		m, err := other.SyncGetShardMembership(ctx, 1)
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to get membership %v", err)
+		}
+		if _, ok := m.Nodes[replicaID]; ok {
+			t.Errorf("replica %d still in membership", replicaID)
+		}
+		if _, ok := m.Removed[replicaID]; !ok {
+			t.Errorf("replica %d not marked as removed", replicaID)
+		}
+		makeProposals(other)
 	}
 }
 
-func TestCorruptedChunkWriterOutputCanBeHandledByChunk(t *testing.T) {
+func TestLeaderCanBeDecommissioned(t *testing.T) {
 	fs := vfs.GetTestFS()
-	testCorruptedChunkWriterOutputCanBeHandledByChunk(t, false, 1, fs)
-	testCorruptedChunkWriterOutputCanBeHandledByChunk(t, true, 0, fs)
+	tf := func() {
+		nhs := startDecommissionTestShard(t, fs)
+		for _, nh := range nhs {
+			defer nh.Close()
+		}
+		leaderID, _, ok, err := nhs[0].GetLeaderID(1)
+		if err != nil || !ok {
+			t.Fatalf("failed to get leader id, %v", err)
+		}
+		leader := nhs[leaderID-1]
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		opt := DecommissionOption{RemoveData: true}
+		if err := leader.SyncDecommissionLocalReplica(ctx, 1, opt); err != nil {
+			t.Fatalf("failed to decommission, %v", err)
+		}
+		checkReplicaDecommissioned(t, nhs, leaderID)
+		err = leader.SyncDecommissionLocalReplica(ctx, 1, opt)
+		if err != ErrShardNotFound {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	runNodeHostTestDC(t, tf, true, fs)
 }
 
-func TestChunkWriterOutputCanBeHandledByChunk(t *testing.T) {
+func TestDecommissionCanBeResumed(t *testing.T) {
 	fs := vfs.GetTestFS()
-	if err := fs.RemoveAll(testSnapshotDir); err != nil {
-		t.Fatalf("%v", err)
-	}
-	c := &chunks{}
-	if err := fs.MkdirAll(c.getSnapshotDirFunc(0, 0), 0755); err != nil {
-		t.Fatalf("%v", err)
-	}
-	cks := transport.NewChunk(c.onReceive,
-		c.confirm, c.getSnapshotDirFunc, 0, fs)
-	sink := &testSink2{receiver: cks}
-	meta := getTestSSMeta()
-	cw := rsm.NewChunkWriter(sink, meta)
-	if _, err := cw.Write(rsm.GetEmptyLRUSession()); err != nil {
-		t.Fatalf("write failed %v", err)
-	}
-	defer func() {
-		if err := fs.RemoveAll(testSnapshotDir); err != nil {
-			t.Fatalf("%v", err)
+	tf := func() {
+		nhs := startDecommissionTestShard(t, fs)
+		for _, nh := range nhs {
+			defer nh.Close()
 		}
-	}()
-	payload := make([]byte, 0)
-	payload = append(payload, rsm.GetEmptyLRUSession()...)
-	for i := 0; i < 10; i++ {
-		data := make([]byte, rsm.ChunkSize)
-		_, _ = rand.Read(data)
-		payload = append(payload, data...)
-		if _, err := cw.Write(data); err != nil {
-			t.Fatalf("failed to write the data %v", err)
+		leaderID, _, ok, err := nhs[0].GetLeaderID(1)
+		if err != nil || !ok {
+			t.Fatalf("failed to get leader id, %v", err)
 		}
+		replicaID := leaderID%3 + 1
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		// the removal is completed elsewhere, e.g. by an invocation interrupted
+		// before the replica is stopped and its data is removed
+		err = nhs[leaderID-1].SyncRequestDeleteReplica(ctx, 1, replicaID, 0)
+		if err != nil {
+			t.Fatalf("failed to delete replica, %v", err)
+		}
+		opt := DecommissionOption{RemoveData: true}
+		nh := nhs[replicaID-1]
+		if err := nh.SyncDecommissionLocalReplica(ctx, 1, opt); err != nil {
+			t.Fatalf("failed to decommission, %v", err)
+		}
+		checkReplicaDecommissioned(t, nhs, replicaID)
 	}
-	if err := cw.Close(); err != nil {
-		t.Fatalf("failed to flush %v", err)
-	}
-	if c.received != 1 {
-		t.Fatalf("failed to receive the snapshot")
-	}
-	if c.confirmed != 1 {
-		t.Fatalf("failed to confirm")
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
+func TestIneligibleLeaderTransferTargetsAreRejected(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		peers := map[uint64]string{1: nodeHostTestAddr1, 2: nodeHostTestAddr2}
+		rc := config.Config{
+			ShardID:      1,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+		}
+		var nhs []*NodeHost
+		for replicaID := uint64(1); replicaID <= 2; replicaID++ {
+			rc.ReplicaID = replicaID
+			nh := startTestReplica(t, fs, rc, peers[replicaID], peers, false, nil)
+			defer nh.Close()
+			nhs = append(nhs, nh)
+		}
+		waitForLeaderToBeElected(t, nhs[0], 1)
+		leaderID, _, ok, err := nhs[0].GetLeaderID(1)
+		if err != nil || !ok {
+			t.Fatalf("failed to get leader id, %v", err)
+		}
+		leader := nhs[leaderID-1]
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := leader.SyncRequestAddWitness(ctx, 1, 3, nodeHostTestAddr3, 0); err != nil {
+			t.Fatalf("failed to add witness, %v", err)
+		}
+		rc.ReplicaID = 3
+		rc.IsWitness = true
+		witness := startTestReplica(t, fs, rc, nodeHostTestAddr3, nil, true, nil)
+		defer witness.Close()
+		// replica 4 is never started so it never catches up with the leader
+		if err := leader.SyncRequestAddReplica(ctx, 1, 4, "a4:1", 0); err != nil {
+			t.Fatalf("failed to add replica, %v", err)
+		}
+		if err := leader.SyncRequestAddNonVoting(ctx, 1, 5, "a5:1", 0); err != nil {
+			t.Fatalf("failed to add nonVoting, %v", err)
+		}
+		if err := leader.SyncRequestAddNonVoting(ctx, 1, 6, "a6:1", 0); err != nil {
+			t.Fatalf("failed to add nonVoting, %v", err)
+		}
+		if err := leader.SyncRequestDeleteReplica(ctx, 1, 6, 0); err != nil {
+			t.Fatalf("failed to delete nonVoting, %v", err)
+		}
+		noWait := LeaderTransferOption{NoCatchupWait: true}
+		tests := []struct {
+			target uint64
+			opt    LeaderTransferOption
+			err    error
+		}{
+			{5, LeaderTransferOption{}, ErrTargetIsNonVoting},
+			{3, LeaderTransferOption{}, ErrTargetIsWitness},
+			{6, LeaderTransferOption{}, ErrTargetNotMember},
+			{100, LeaderTransferOption{}, ErrTargetNotMember},
+			{4, noWait, ErrTargetLagging},
+			{0, LeaderTransferOption{}, ErrInvalidTarget},
+		}
+		for idx, tt := range tests {
+			err := leader.RequestLeaderTransferWithOption(1, tt.target, tt.opt)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%d, got %v, want %v", idx, err, tt.err)
+			}
+			err = leader.SyncRequestLeaderTransfer(ctx, 1, tt.target, tt.opt)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%d, got %v, want %v", idx, err, tt.err)
+			}
+		}
+		target := leaderID%2 + 1
+		if err := leader.SyncRequestLeaderTransfer(ctx, 1, target, noWait); err != nil {
+			t.Fatalf("failed to transfer leadership, %v", err)
+		}
+		// membership based checks are performed on followers as well
+		if err := leader.RequestLeaderTransfer(1, 3); err != ErrTargetIsWitness {
+			t.Errorf("unexpected error %v", err)
+		}
 	}
-	fp := fs.PathJoin(testSnapshotDir,
-		"snapshot-00000000000003E8", "snapshot-00000000000003E8.gbsnap")
-	reader, _, err := rsm.NewSnapshotReader(fp, fs)
-	if err != nil {
-		t.Fatalf("failed to get a snapshot reader %v", err)
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
+func TestLeaderStepsDownWhenQuorumIsLost(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		rel := &testRaftEventListener{}
+		var nhs []*NodeHost
+		for replicaID := uint64(1); replicaID <= 3; replicaID++ {
+			rc := config.Config{
+				ShardID:          1,
+				ReplicaID:        replicaID,
+				ElectionRTT:      10,
+				HeartbeatRTT:     1,
+				CheckQuorum:      true,
+				LeaderPreference: map[uint64]uint64{1: 1},
+			}
+			var l raftio.IRaftEventListener
+			if replicaID == 1 {
+				l = rel
+			}
+			nhs = append(nhs, startThreeReplicaTestShard(t, fs, rc, l))
+		}
+		nh1 := nhs[0]
+		defer nh1.Close()
+		waitForLeaderID(t, nh1, 1)
+		makeProposals(nh1)
+		// the leader is partitioned from both followers
+		nhs[1].Close()
+		nhs[2].Close()
+		// the proposal can't be committed, it is expected to complete once the
+		// leader stepped down, long before its timeout
+		timeout := 30 * time.Second
+		cs := nh1.GetNoOPSession(1)
+		rs, err := nh1.Propose(cs, []byte("test-data"), timeout)
+		if err != nil {
+			t.Fatalf("failed to make proposal %v", err)
+		}
+		defer rs.Release()
+		start := time.Now()
+		select {
+		case r := <-rs.ResultC():
+			if !r.Timeout() {
+				t.Errorf("unexpected result %v", r)
+			}
+			// CheckQuorum is performed every ElectionRTT
+			rtt := time.Duration(nh1.NodeHostConfig().RTTMillisecond) * time.Millisecond
+			if budget := 2*10*rtt + time.Second; time.Since(start) > budget {
+				t.Errorf("proposal failed too late, %v", time.Since(start))
+			}
+		case <-time.After(timeout):
+			t.Fatalf("proposal hanging")
+		}
+		leaderID, _, ok, err := nh1.GetLeaderID(1)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		if ok || leaderID != 0 {
+			t.Errorf("leader didn't step down, %d", leaderID)
+		}
+		steppedDown := false
+		for i := 0; i < 100 && !steppedDown; i++ {
+			for _, info := range rel.get() {
+				if info.LeaderID == 0 && info.Term > 0 {
+					steppedDown = true
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !steppedDown {
+			t.Errorf("no leader event reported, %v", rel.get())
+		}
 	}
-	defer reader.Close()
-	got := make([]byte, 0)
-	buf := make([]byte, 1024*256)
-	for {
-		n, err := reader.Read(buf)
-		if n > 0 {
-			got = append(got, buf[:n]...)
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
+func TestUnsafeNodeRemovalIsRejected(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    1,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
+		}
+		peers := make(map[uint64]string)
+		peers[1] = nodeHostTestAddr1
+		dir := fs.PathJoin(singleNodeHostTestDir, "nh1")
+		nhc1 := config.NodeHostConfig{
+			NodeHostDir:    dir,
+			RTTMillisecond: getRTTMillisecond(fs, dir),
+			RaftAddress:    nodeHostTestAddr1,
+			Expert:         getTestExpertConfig(fs),
+		}
+		nh1, err := NewNodeHost(nhc1)
+		if err != nil {
+			t.Fatalf("failed to create node host %v", err)
+		}
+		defer nh1.Close()
+		newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return tests.NewSimDiskSM(0)
+		}
+		if err := nh1.StartOnDiskReplica(peers, false, newSM, rc); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		waitForLeaderToBeElected(t, nh1, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh1))
+		if err := nh1.SyncRequestAddReplica(ctx, 1, 2, nodeHostTestAddr2, 0); err != nil {
+			t.Fatalf("failed to add node %v", err)
+		}
+		cancel()
+		rc2 := rc
+		rc2.ReplicaID = 2
+		nhc2 := nhc1
+		nhc2.RaftAddress = nodeHostTestAddr2
+		nhc2.NodeHostDir = fs.PathJoin(singleNodeHostTestDir, "nh2")
+		nh2, err := NewNodeHost(nhc2)
+		if err != nil {
+			t.Fatalf("failed to create node host %v", err)
+		}
+		defer nh2.Close()
+		if err := nh2.StartOnDiskReplica(nil, true, newSM, rc2); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		waitForLeaderToBeElected(t, nh2, 1)
+		// replica 3 is added but never started
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh1))
+			err := nh1.SyncRequestAddReplica(ctx, 1, 3, "localhost:65535", 0)
+			cancel()
+			if err == nil {
+				break
+			}
+			// a timed out request might still be applied later
+			if errors.Is(err, ErrRejected) {
+				ctx, cancel := context.WithTimeout(context.Background(), pto(nh1))
+				m, merr := nh1.SyncGetShardMembership(ctx, 1)
+				cancel()
+				if merr == nil && m.Nodes[3] == "localhost:65535" {
+					break
+				}
+			}
+			if !errors.Is(err, ErrShardNotReady) && !errors.Is(err, ErrTimeout) {
+				t.Fatalf("failed to add node %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), pto(nh1))
+		err = nh1.SyncRequestDeleteReplica(ctx, 1, 2, 0)
+		cancel()
+		if !errors.Is(err, ErrUnsafeMembershipChange) {
+			t.Fatalf("unsafe removal not rejected, %v", err)
+		}
+		if !strings.Contains(err.Error(), "[3]") {
+			t.Errorf("inactive node not named, %v", err)
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), pto(nh1))
+		m, err := nh1.SyncGetShardMembership(ctx, 1)
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to get membership %v", err)
+		}
+		if len(m.Nodes) != 3 || len(m.Removed) != 0 {
+			t.Fatalf("unexpected membership %+v", m)
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), pto(nh1))
+		if err := nh1.SyncRequestDeleteReplica(ctx, 1, 3, 0); err != nil {
+			t.Fatalf("failed to remove the inactive node %v", err)
+		}
+		cancel()
+		ctx, cancel = context.WithTimeout(context.Background(), pto(nh1))
+		m, err = nh1.SyncGetShardMembership(ctx, 1)
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to get membership %v", err)
 		}
-		if err == io.EOF {
-			break
+		if _, ok := m.Removed[3]; !ok || len(m.Nodes) != 2 {
+			t.Errorf("unexpected membership %+v", m)
 		}
 	}
-	if !bytes.Equal(got, payload) {
-		t.Errorf("snapshot content changed")
-	}
-}
-
-func TestNodeHostReturnsErrorWhenTransportCanNotBeCreated(t *testing.T) {
-	fs := vfs.GetTestFS()
-	if fs != vfs.DefaultFS {
-		t.Skip("memfs test mode, skipped")
-	}
-	to := &testOption{
-		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
-			c.RaftAddress = "microsoft.com:12345"
-			return c
-		},
-		newNodeHostToFail: true,
-	}
-	runNodeHostTest(t, to, fs)
+	runNodeHostTestDC(t, tf, true, fs)
 }
 
-func TestNodeHostChecksLogDBType(t *testing.T) {
-	fs := vfs.GetTestFS()
-	ldb := &noopLogDB{}
-	to := &testOption{
-		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
-			c.Expert.LogDBFactory = &testLogDBFactory{ldb: ldb}
-			return c
-		},
-		at: func(*NodeHost) {
-			nhc := getTestNodeHostConfig(fs)
-			_, err := NewNodeHost(*nhc)
-			if err != server.ErrLogDBType {
-				t.Fatalf("didn't report logdb type error %v", err)
-			}
-		},
-		noElection: true,
+func getTestConfigChangeHistory(t *testing.T,
+	nh *NodeHost) []ConfigChangeRecord {
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+		history, err := nh.GetConfigChangeHistory(ctx, 1)
+		cancel()
+		if err == nil {
+			return history
+		}
+		// the replica might still be catching up
+		if !errors.Is(err, ErrTimeout) && !errors.Is(err, ErrShardNotReady) {
+			t.Fatalf("failed to get config change history %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
-	runNodeHostTest(t, to, fs)
-}
-
-var spawnChild = flag.Bool("spawn-child", false, "spawned child")
-
-func spawn(execName string) ([]byte, error) {
-	return exec.Command(execName, "-spawn-child",
-		"-test.v", "-test.run=TestNodeHostFileLock$").CombinedOutput()
+	t.Fatalf("failed to get config change history")
+	return nil
 }
 
-func TestNodeHostFileLock(t *testing.T) {
+func TestConfigChangeHistoryIsRecoveredFromSnapshot(t *testing.T) {
 	fs := vfs.GetTestFS()
-	if fs != vfs.DefaultFS {
-		t.Skip("not using the default fs, skipped")
-	}
 	tf := func() {
-		child := *spawnChild
-		nhc := config.NodeHostConfig{
-			NodeHostDir:    singleNodeHostTestDir,
-			RTTMillisecond: getRTTMillisecond(fs, singleNodeHostTestDir),
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    1,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
+		}
+		peers := make(map[uint64]string)
+		peers[1] = nodeHostTestAddr1
+		dir := fs.PathJoin(singleNodeHostTestDir, "nh1")
+		nhc1 := config.NodeHostConfig{
+			NodeHostDir:    dir,
+			RTTMillisecond: getRTTMillisecond(fs, dir),
 			RaftAddress:    nodeHostTestAddr1,
 			Expert:         getTestExpertConfig(fs),
 		}
-		if !child {
-			nh, err := NewNodeHost(nhc)
-			if err != nil {
-				t.Fatalf("failed to create nodehost %v", err)
-			}
-			defer nh.Close()
-			out, err := spawn(os.Args[0])
-			if err == nil {
-				t.Fatalf("file lock didn't prevent the second nh to start, %s", out)
-			}
-			if !bytes.Contains(out, []byte("returned ErrLockDirectory")) {
-				t.Fatalf("unexpected output: %s", out)
+		nh1, err := NewNodeHost(nhc1)
+		if err != nil {
+			t.Fatalf("failed to create node host %v", err)
+		}
+		defer nh1.Close()
+		newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return tests.NewSimDiskSM(0)
+		}
+		if err := nh1.StartOnDiskReplica(peers, false, newSM, rc); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		waitForLeaderToBeElected(t, nh1, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh1))
+		if err := nh1.SyncRequestAddNonVoting(ctx, 1, 3, "localhost:65535", 0); err != nil {
+			t.Fatalf("failed to add nonVoting %v", err)
+		}
+		cancel()
+		ctx, cancel = context.WithTimeout(context.Background(), pto(nh1))
+		if err := nh1.SyncRequestDeleteReplica(ctx, 1, 3, 0); err != nil {
+			t.Fatalf("failed to remove nonVoting %v", err)
+		}
+		cancel()
+		for i := 0; i < 4; i++ {
+			makeProposals(nh1)
+			ctx, cancel := context.WithTimeout(context.Background(), lpto(nh1))
+			opt := SnapshotOption{OverrideCompactionOverhead: true, CompactionOverhead: 1}
+			if _, err := nh1.SyncRequestSnapshot(ctx, 1, opt); err != nil {
+				t.Fatalf("failed to request snapshot %v", err)
 			}
-		} else {
-			nhc.RaftAddress = nodeHostTestAddr2
-			cnh, err := NewNodeHost(nhc)
-			if err == server.ErrLockDirectory {
-				t.Fatalf("returned ErrLockDirectory")
+			cancel()
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), pto(nh1))
+		if err := nh1.SyncRequestAddReplica(ctx, 1, 2, nodeHostTestAddr2, 0); err != nil {
+			t.Fatalf("failed to add node %v", err)
+		}
+		cancel()
+		rc2 := rc
+		rc2.ReplicaID = 2
+		nhc2 := nhc1
+		nhc2.RaftAddress = nodeHostTestAddr2
+		nhc2.NodeHostDir = fs.PathJoin(singleNodeHostTestDir, "nh2")
+		nh2, err := NewNodeHost(nhc2)
+		if err != nil {
+			t.Fatalf("failed to create node host %v", err)
+		}
+		defer nh2.Close()
+		joined := tests.NewSimDiskSM(0)
+		newJoinedSM := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return joined
+		}
+		if err := nh2.StartOnDiskReplica(nil, true, newJoinedSM, rc2); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		waitForLeaderToBeElected(t, nh2, 1)
+		for i := 0; i < 200 && joined.GetRecovered() == 0; i++ {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if joined.GetRecovered() == 0 {
+			t.Fatalf("joined replica not recovered from snapshot")
+		}
+		history := getTestConfigChangeHistory(t, nh1)
+		// the initial member is recorded when bootstrapping the shard
+		if len(history) != 4 {
+			t.Fatalf("unexpected history %+v", history)
+		}
+		if history[0].Type != pb.AddNode || history[0].ReplicaID != 1 ||
+			history[1].Type != pb.AddNonVoting || history[1].ReplicaID != 3 ||
+			history[2].Type != pb.RemoveNode || history[2].ReplicaID != 3 ||
+			history[3].Type != pb.AddNode || history[3].ReplicaID != 2 ||
+			history[3].Address != nodeHostTestAddr2 {
+			t.Errorf("unexpected history %+v", history)
+		}
+		recovered := getTestConfigChangeHistory(t, nh2)
+		if len(recovered) != len(history) {
+			t.Fatalf("unexpected recovered history %+v", recovered)
+		}
+		for i := range history {
+			r, h := recovered[i], history[i]
+			if r.Index != h.Index || r.Term != h.Term || r.Type != h.Type ||
+				r.ReplicaID != h.ReplicaID || r.Address != h.Address {
+				t.Errorf("history mismatch, %+v vs %+v", r, h)
 			}
-			if err == nil {
-				defer cnh.Close()
+		}
+		// records of the snapshot are recovered with their original time
+		for i := 0; i < 3; i++ {
+			if !recovered[i].AppliedAt.Equal(history[i].AppliedAt) {
+				t.Errorf("applied time not recovered, %+v vs %+v",
+					recovered[i], history[i])
 			}
 		}
 	}
-	runNodeHostTestDC(t, tf, !*spawnChild, fs)
+	runNodeHostTestDC(t, tf, true, fs)
 }
 
-func TestChangeNodeHostID(t *testing.T) {
+func TestNonVotingCanServeLinearizableRead(t *testing.T) {
 	fs := vfs.GetTestFS()
 	tf := func() {
-		nhc := config.NodeHostConfig{
-			NodeHostDir:    singleNodeHostTestDir,
-			RTTMillisecond: getRTTMillisecond(fs, singleNodeHostTestDir),
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    1,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
+		}
+		peers := make(map[uint64]string)
+		peers[1] = nodeHostTestAddr1
+		dir := fs.PathJoin(singleNodeHostTestDir, "nh1")
+		nhc1 := config.NodeHostConfig{
+			NodeHostDir:    dir,
+			RTTMillisecond: getRTTMillisecond(fs, dir),
 			RaftAddress:    nodeHostTestAddr1,
 			Expert:         getTestExpertConfig(fs),
 		}
-		nh, err := NewNodeHost(nhc)
+		nh1, err := NewNodeHost(nhc1)
 		if err != nil {
-			t.Fatalf("failed to create nodehost %v", err)
-		}
-		nh.Close()
-		v := id.New()
-		nhc.NodeHostID = v.String()
-		_, err = NewNodeHost(nhc)
-		if err == nil || !errors.Is(err, server.ErrNodeHostIDChanged) {
-			t.Fatalf("failed to reject changed NodeHostID %v", err)
+			t.Fatalf("failed to create node host %v", err)
 		}
-	}
-	runNodeHostTestDC(t, tf, !*spawnChild, fs)
-}
-
-type testLogDBFactory2 struct {
-	f func(config.NodeHostConfig,
-		config.LogDBCallback, []string, []string) (raftio.ILogDB, error)
-	name string
-}
-
-func (t *testLogDBFactory2) Create(cfg config.NodeHostConfig, cb config.LogDBCallback,
-	dirs []string, wals []string) (raftio.ILogDB, error) {
-	return t.f(cfg, cb, dirs, wals)
-}
-
-func (t *testLogDBFactory2) Name() string {
-	return t.name
-}
-
-func TestNodeHostReturnsErrLogDBBrokenChangeWhenLogDBTypeChanges(t *testing.T) {
-	fs := vfs.GetTestFS()
-	bff := func(config config.NodeHostConfig, cb config.LogDBCallback,
-		dirs []string, lldirs []string) (raftio.ILogDB, error) {
-		return logdb.NewDefaultBatchedLogDB(config, cb, dirs, lldirs)
-	}
-	nff := func(config config.NodeHostConfig, cb config.LogDBCallback,
-		dirs []string, lldirs []string) (raftio.ILogDB, error) {
-		return logdb.NewDefaultLogDB(config, cb, dirs, lldirs)
-	}
-	to := &testOption{
-		at: func(*NodeHost) {
-			nhc := getTestNodeHostConfig(fs)
-			nhc.Expert.LogDBFactory = &testLogDBFactory2{f: nff}
-			if _, err := NewNodeHost(*nhc); err != server.ErrLogDBBrokenChange {
-				t.Errorf("failed to return ErrLogDBBrokenChange")
+		defer func() {
+			if nh1 != nil {
+				nh1.Close()
 			}
-		},
-		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
-			c.Expert.LogDBFactory = &testLogDBFactory2{f: bff}
-			return c
-		},
-		noElection: true,
-	}
-	runNodeHostTest(t, to, fs)
-}
-
-func TestNodeHostByDefaultUsePlainEntryLogDB(t *testing.T) {
-	fs := vfs.GetTestFS()
-	bff := func(config config.NodeHostConfig, cb config.LogDBCallback,
-		dirs []string, lldirs []string) (raftio.ILogDB, error) {
-		return logdb.NewDefaultBatchedLogDB(config, cb, dirs, lldirs)
-	}
-	nff := func(config config.NodeHostConfig, cb config.LogDBCallback,
-		dirs []string, lldirs []string) (raftio.ILogDB, error) {
-		return logdb.NewDefaultLogDB(config, cb, dirs, lldirs)
-	}
-	to := &testOption{
-		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
-			c.Expert.LogDBFactory = &testLogDBFactory2{f: nff}
-			return c
-		},
-		noElection: true,
-		at: func(*NodeHost) {
-			nhc := getTestNodeHostConfig(fs)
-			nhc.Expert.LogDBFactory = &testLogDBFactory2{f: bff}
-			if _, err := NewNodeHost(*nhc); err != server.ErrIncompatibleData {
-				t.Errorf("failed to return server.ErrIncompatibleData")
+		}()
+		newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return tests.NewSimDiskSM(0)
+		}
+		if err := nh1.StartOnDiskReplica(peers, false, newSM, rc); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		waitForLeaderToBeElected(t, nh1, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh1))
+		if err := nh1.SyncRequestAddNonVoting(ctx, 1, 2, nodeHostTestAddr2, 0); err != nil {
+			t.Fatalf("failed to add nonVoting %v", err)
+		}
+		cancel()
+		rc2 := rc
+		rc2.ReplicaID = 2
+		rc2.IsNonVoting = true
+		nhc2 := nhc1
+		nhc2.RaftAddress = nodeHostTestAddr2
+		nhc2.NodeHostDir = fs.PathJoin(singleNodeHostTestDir, "nh2")
+		nh2, err := NewNodeHost(nhc2)
+		if err != nil {
+			t.Fatalf("failed to create node host %v", err)
+		}
+		defer nh2.Close()
+		if err := nh2.StartOnDiskReplica(nil, true, newSM, rc2); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		waitForLeaderToBeElected(t, nh2, 1)
+		read := func(nh *NodeHost) (uint64, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			v, err := nh.SyncRead(ctx, 1, nil)
+			if err != nil {
+				return 0, err
 			}
-		},
-	}
-	runNodeHostTest(t, to, fs)
-}
-
-func TestNodeHostByDefaultChecksWhetherToUseBatchedLogDB(t *testing.T) {
-	fs := vfs.GetTestFS()
-	bff := func(config config.NodeHostConfig, cb config.LogDBCallback,
-		dirs []string, lldirs []string) (raftio.ILogDB, error) {
-		return logdb.NewDefaultBatchedLogDB(config, cb, dirs, lldirs)
-	}
-	nff := func(config config.NodeHostConfig, cb config.LogDBCallback,
-		dirs []string, lldirs []string) (raftio.ILogDB, error) {
-		return logdb.NewDefaultLogDB(config, cb, dirs, lldirs)
-	}
-	to := &testOption{
-		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
-			c.Expert.LogDBFactory = &testLogDBFactory2{f: bff}
-			return c
-		},
-		createSM: func(uint64, uint64) sm.IStateMachine {
-			return &PST{}
-		},
-		tf: func(nh *NodeHost) {
-			pto := pto(nh)
-			cs := nh.GetNoOPSession(1)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			_, err := nh.SyncPropose(ctx, cs, []byte("test-data"))
+			return v.(uint64), nil
+		}
+		// wait for the nonVoting to catch up
+		for i := 0; i < 10; i++ {
+			if _, err := read(nh2); err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		session := nh1.GetNoOPSession(1)
+		for i := 0; i < 10; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh1))
+			result, err := nh1.SyncPropose(ctx, session, []byte("test-data"))
 			cancel()
 			if err != nil {
-				t.Errorf("failed to make proposal %v", err)
+				t.Fatalf("failed to make proposal %v", err)
 			}
-		},
-		at: func(*NodeHost) {
-			nhc := getTestNodeHostConfig(fs)
-			nhc.Expert.LogDBFactory = &testLogDBFactory2{f: nff}
-			if nh, err := NewNodeHost(*nhc); err != nil {
-				t.Errorf("failed to create node host")
-			} else {
-				nh.Close()
+			voter, err := read(nh1)
+			if err != nil {
+				t.Fatalf("failed to read from voter %v", err)
 			}
-		},
+			nonVoting, err := read(nh2)
+			if err != nil {
+				t.Fatalf("failed to read from nonVoting %v", err)
+			}
+			if voter < result.Value || nonVoting < voter {
+				t.Fatalf("stale read, proposal %d, voter %d, nonVoting %d",
+					result.Value, voter, nonVoting)
+			}
+		}
+		// reads can not be served by the nonVoting without a leader
+		nh1.Close()
+		nh1 = nil
+		if _, err := read(nh2); err == nil {
+			t.Errorf("read served without a leader")
+		}
 	}
-	runNodeHostTest(t, to, fs)
+	runNodeHostTestDC(t, tf, true, fs)
 }
 
-func TestNodeHostWithUnexpectedDeploymentIDWillBeDetected(t *testing.T) {
+func TestWitnessesAreLimited(t *testing.T) {
 	fs := vfs.GetTestFS()
-	to := &testOption{
-		noElection: true,
-		at: func(*NodeHost) {
-			nhc := getTestNodeHostConfig(fs)
-			nhc.DeploymentID = 200
-			_, err := NewNodeHost(*nhc)
-			if err != server.ErrDeploymentIDChanged {
-				t.Errorf("failed to return ErrDeploymentIDChanged, got %v", err)
+	tf := func(nh1 *NodeHost, nh2 *NodeHost, witness *tests.SimDiskSM) {
+		// the request is dropped until the witness advertised its protocol
+		// version to the leader, it times out before the witness catches up
+		for i := 0; ; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh1))
+			err := nh1.SyncRequestAddWitness(ctx, 1, 3, nodeHostTestAddr3, 0)
+			cancel()
+			if errors.Is(err, ErrTooManyWitnesses) {
+				break
 			}
-		},
+			if (!errors.Is(err, ErrShardNotReady) &&
+				!errors.Is(err, ErrTimeout)) || i > 100 {
+				t.Fatalf("witness addition not rejected, %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh1))
+		defer cancel()
+		m, err := nh1.SyncGetShardMembership(ctx, 1)
+		if err != nil {
+			t.Fatalf("failed to get membership %v", err)
+		}
+		if len(m.Witnesses) != 1 || len(m.Nodes) != 1 {
+			t.Errorf("unexpected membership %+v", m)
+		}
 	}
-	runNodeHostTest(t, to, fs)
+	testWitnessIO(t, tf, fs)
 }
 
-func TestGossipInfoIsReported(t *testing.T) {
+func TestNonVotingsAreLimited(t *testing.T) {
 	fs := vfs.GetTestFS()
-	advertiseAddress := "202.96.1.2:12345"
 	to := &testOption{
-		noElection: true,
-		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
-			c.DefaultNodeRegistryEnabled = true
-			c.Gossip = config.GossipConfig{
-				BindAddress:      "localhost:23001",
-				AdvertiseAddress: advertiseAddress,
-				Seed:             []string{"localhost:23002"},
-			}
+		defaultTestNode: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.MaxNonVotings = 2
 			return c
 		},
 		tf: func(nh *NodeHost) {
-			nhi := nh.GetNodeHostInfo(DefaultNodeHostInfoOption)
-			if nhi.Gossip.AdvertiseAddress != advertiseAddress {
-				t.Errorf("unexpected advertise address, got %s, want %s",
-					nhi.Gossip.AdvertiseAddress, advertiseAddress)
-			}
-			if !nhi.Gossip.Enabled {
-				t.Errorf("gossip info not marked as enabled")
+			add := func(replicaID uint64) error {
+				ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+				defer cancel()
+				addr := fmt.Sprintf("localhost:%d", 25000+replicaID)
+				return nh.SyncRequestAddNonVoting(ctx, 1, replicaID, addr, 0)
 			}
-			if nhi.Gossip.NumOfKnownNodeHosts != 1 {
-				t.Errorf("unexpected NumOfKnownNodeHosts, got %d, want 1",
-					nhi.Gossip.NumOfKnownNodeHosts)
+			for _, replicaID := range []uint64{2, 3} {
+				if err := add(replicaID); err != nil {
+					t.Fatalf("failed to add nonVoting %v", err)
+				}
 			}
-			if nhi.NodeHostID != nh.ID() {
-				t.Errorf("unexpected NodeHostID, got %s, want %s", nhi.NodeHostID, nh.ID())
+			if err := add(4); !errors.Is(err, ErrTooManyNonVotings) {
+				t.Fatalf("nonVoting addition not rejected, %v", err)
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestLeaderInfoIsReported(t *testing.T) {
+func TestReplicaIDAndAddressReuseIsRejected(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
 		defaultTestNode: true,
 		tf: func(nh *NodeHost) {
-			leaderAvailable := false
-			for i := 0; i < 500; i++ {
-				nhi := nh.GetNodeHostInfo(DefaultNodeHostInfoOption)
-				if len(nhi.ShardInfoList) != 1 {
-					t.Errorf("unexpected len: %d", len(nhi.ShardInfoList))
-				}
-				if nhi.ShardInfoList[0].ShardID != 1 {
-					t.Fatalf("unexpected shard id")
-				}
-				if nhi.ShardInfoList[0].LeaderID != 1 {
-					time.Sleep(20 * time.Millisecond)
-				} else {
-					leaderAvailable = true
-					break
-				}
-			}
-			if !leaderAvailable {
-				t.Fatalf("failed to get leader info")
-			}
-			pto := pto(nh)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
 			defer cancel()
-			if err := nh.SyncRequestAddReplica(ctx, 1, 2, "noidea:8080", 0); err != nil {
-				t.Fatalf("failed to add node %v", err)
+			if err := nh.SyncRequestAddNonVoting(ctx, 1, 2, "localhost:25002", 0); err != nil {
+				t.Fatalf("failed to add nonVoting %v", err)
 			}
-			for i := 0; i < 500; i++ {
-				nhi := nh.GetNodeHostInfo(DefaultNodeHostInfoOption)
-				if len(nhi.ShardInfoList) != 1 {
-					t.Errorf("unexpected len: %d", len(nhi.ShardInfoList))
-				}
-				if nhi.ShardInfoList[0].LeaderID == 1 {
-					time.Sleep(20 * time.Millisecond)
-				} else {
-					return
-				}
+			if err := nh.SyncRequestDeleteReplica(ctx, 1, 2, 0); err != nil {
+				t.Fatalf("failed to delete nonVoting %v", err)
 			}
-			t.Fatalf("no leader info change")
-		},
-	}
-	runNodeHostTest(t, to, fs)
-}
-
-func TestDroppedRequestsAreReported(t *testing.T) {
-	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			pto := lpto(nh)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			defer cancel()
-			if err := nh.SyncRequestAddReplica(ctx, 1, 2, "noidea:8080", 0); err != nil {
-				t.Fatalf("failed to add node %v", err)
+			err := nh.SyncRequestAddNonVoting(ctx, 1, 2, "localhost:25002", 0)
+			if !errors.Is(err, ErrReplicaIDReused) {
+				t.Fatalf("replica id reuse not rejected, %v", err)
 			}
-			for i := 0; i < 1000; i++ {
-				_, _, ok, err := nh.GetLeaderID(1)
-				if err != nil {
-					t.Fatalf("failed to get leader id %v", err)
-				}
-				if err == nil && !ok {
-					break
-				}
-				time.Sleep(10 * time.Millisecond)
-				if i == 999 {
-					t.Fatalf("leader failed to step down")
-				}
+			opt := AddReplicaOption{AllowReplicaIDReuse: true}
+			if err := nh.SyncRequestAddNonVotingWithOption(ctx,
+				1, 2, "localhost:25002", 0, opt); err != nil {
+				t.Fatalf("failed to reuse replica id %v", err)
+			}
+			err = nh.SyncRequestAddNonVoting(ctx, 1, 3, "localhost:25002", 0)
+			if !errors.Is(err, ErrAddressInUse) {
+				t.Fatalf("address reuse not rejected, %v", err)
 			}
-			unlimited := 30 * time.Minute
-			func() {
-				nctx, ncancel := context.WithTimeout(context.Background(), unlimited)
-				defer ncancel()
-				cs := nh.GetNoOPSession(1)
-				for i := 0; i < 10; i++ {
-					if _, err := nh.SyncPropose(nctx, cs, make([]byte, 1)); err != ErrShardNotReady {
-						t.Errorf("failed to get ErrShardNotReady, got %v", err)
-					}
-				}
-			}()
-			func() {
-				nctx, ncancel := context.WithTimeout(context.Background(), unlimited)
-				defer ncancel()
-				for i := 0; i < 10; i++ {
-					if err := nh.SyncRequestAddReplica(nctx, 1, 3, "noidea:8080", 0); err != ErrShardNotReady {
-						t.Errorf("failed to get ErrShardNotReady, got %v", err)
-					}
-				}
-			}()
-			func() {
-				nctx, ncancel := context.WithTimeout(context.Background(), unlimited)
-				defer ncancel()
-				for i := 0; i < 10; i++ {
-					if _, err := nh.SyncRead(nctx, 1, nil); err != ErrShardNotReady {
-						t.Errorf("failed to get ErrShardNotReady, got %v", err)
-					}
-				}
-			}()
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-type testRaftEventListener struct {
-	mu       sync.Mutex
-	received []raftio.LeaderInfo
-}
-
-func (rel *testRaftEventListener) LeaderUpdated(info raftio.LeaderInfo) {
-	rel.mu.Lock()
-	defer rel.mu.Unlock()
-	rel.received = append(rel.received, info)
-}
-
-func (rel *testRaftEventListener) get() []raftio.LeaderInfo {
-	rel.mu.Lock()
-	defer rel.mu.Unlock()
-	r := make([]raftio.LeaderInfo, 0)
-	return append(r, rel.received...)
-}
-
-func TestRaftEventsAreReported(t *testing.T) {
-	fs := vfs.GetTestFS()
-	rel := &testRaftEventListener{
-		received: make([]raftio.LeaderInfo, 0),
-	}
-	to := &testOption{
-		defaultTestNode: true,
-		updateNodeHostConfig: func(nh *config.NodeHostConfig) *config.NodeHostConfig {
-			nh.RaftEventListener = rel
-			return nh
-		},
-		tf: func(nh *NodeHost) {
-			pto := pto(nh)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			if err := nh.SyncRequestAddReplica(ctx, 1, 2, "127.0.0.1:8080", 0); err != nil {
-				t.Fatalf("add node failed %v", err)
-			}
-			cancel()
-			var received []raftio.LeaderInfo
-			for i := 0; i < 1000; i++ {
-				received = rel.get()
-				if len(received) >= 4 {
-					break
-				}
-				time.Sleep(10 * time.Millisecond)
-				if i == 999 {
-					t.Fatalf("failed to get the second LeaderUpdated notification")
-				}
-			}
-			exp0 := raftio.LeaderInfo{
-				ShardID:   1,
-				ReplicaID: 1,
-				LeaderID:  raftio.NoLeader,
-				Term:      1,
-			}
-			exp1 := raftio.LeaderInfo{
-				ShardID:   1,
-				ReplicaID: 1,
-				LeaderID:  raftio.NoLeader,
-				Term:      2,
+func TestRemovedReplicasAreBounded(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.MaxRemovedReplicas = 2
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			for replicaID := uint64(2); replicaID <= 5; replicaID++ {
+				addr := fmt.Sprintf("localhost:%d", 25000+replicaID)
+				if err := nh.SyncRequestAddNonVoting(ctx, 1, replicaID, addr, 0); err != nil {
+					t.Fatalf("failed to add nonVoting %v", err)
+				}
+				if err := nh.SyncRequestDeleteReplica(ctx, 1, replicaID, 0); err != nil {
+					t.Fatalf("failed to delete nonVoting %v", err)
+				}
 			}
-			exp2 := raftio.LeaderInfo{
-				ShardID:   1,
-				ReplicaID: 1,
-				LeaderID:  1,
-				Term:      2,
+			m, err := nh.SyncGetShardMembership(ctx, 1)
+			if err != nil {
+				t.Fatalf("failed to get membership %v", err)
 			}
-			exp3 := raftio.LeaderInfo{
-				ShardID:   1,
-				ReplicaID: 1,
-				LeaderID:  raftio.NoLeader,
-				Term:      2,
+			if len(m.Removed) != 2 || m.PrunedRemoved != 2 || m.PrunedRemovedMax != 3 {
+				t.Errorf("unexpected membership %+v", m)
 			}
-			expected := []raftio.LeaderInfo{exp0, exp1, exp2, exp3}
-			for idx := range expected {
-				if !reflect.DeepEqual(&(received[idx]), &expected[idx]) {
-					t.Errorf("unexpecded leader info, %d, %v, %v",
-						idx, received[idx], expected[idx])
-				}
+			err = nh.SyncRequestAddNonVoting(ctx, 1, 2, "localhost:25002", 0)
+			if !errors.Is(err, ErrReplicaIDReused) {
+				t.Fatalf("pruned replica id reuse not rejected, %v", err)
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestV2DataCanBeHandled(t *testing.T) {
+func TestRemovedFollowerIsReported(t *testing.T) {
 	fs := vfs.GetTestFS()
-	if vfs.GetTestFS() != vfs.DefaultFS {
-		t.Skip("skipped as not using the default fs")
-	}
-	v2datafp := "internal/logdb/testdata/v2-rocksdb-batched.tar.bz2"
-	targetDir := "test-v2-data-safe-to-remove"
-	if err := fs.RemoveAll(targetDir); err != nil {
-		t.Fatalf("%v", err)
-	}
 	defer func() {
-		if err := fs.RemoveAll(targetDir); err != nil {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
 			t.Fatalf("%v", err)
 		}
 	}()
-	topDirName := "single_nodehost_test_dir_safe_to_delete"
-	testHostname := "lindfield.local"
-	if err := fileutil.ExtractTarBz2(v2datafp, targetDir, fs); err != nil {
-		t.Fatalf("%v", err)
-	}
-	hostname, err := os.Hostname()
-	if err != nil {
-		t.Fatalf("failed to get hostname %v", err)
-	}
-	testPath := fs.PathJoin(targetDir, topDirName, testHostname)
-	expPath := fs.PathJoin(targetDir, topDirName, hostname)
-	if expPath != testPath {
-		if err := fs.Rename(testPath, expPath); err != nil {
-			t.Fatalf("failed to rename the dir %v", err)
+	func() {
+		defer leaktest.AfterTest(t)()
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
 		}
-	}
-	v2dataDir := fs.PathJoin(targetDir, topDirName)
-	to := &testOption{
-		noElection: true,
-		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
-			c.WALDir = v2dataDir
-			c.NodeHostDir = v2dataDir
-			return c
-		},
-		tf: func(nh *NodeHost) {
-			name := nh.mu.logdb.Name()
-			if name != "sharded-pebble" {
-				// v2-rocksdb-batched.tar.bz2 contains rocksdb format data
-				t.Skip("skipped as not using rocksdb compatible logdb")
+		network := memtransport.NewNetwork()
+		rtt := getRTTMillisecond(fs, singleNodeHostTestDir)
+		configs := network.NodeHostConfigs(3, singleNodeHostTestDir, rtt)
+		var nhs []*NodeHost
+		var listeners []*testSysEventListener
+		defer func() {
+			for _, nh := range nhs {
+				nh.Close()
 			}
-			logdb := nh.mu.logdb
-			rs, err := logdb.ReadRaftState(2, 1, 0)
+		}()
+		for _, nhc := range configs {
+			nhc.Expert = getTestExpertConfig(fs)
+			nhc.Expert.TransportFactory = network
+			l := &testSysEventListener{}
+			nhc.SystemEventListener = l
+			nh, err := NewNodeHost(nhc)
 			if err != nil {
-				t.Fatalf("failed to get raft state %v", err)
+				t.Fatalf("failed to create nodehost %v", err)
 			}
-			if rs.EntryCount != 3 || rs.State.Commit != 3 {
-				t.Errorf("unexpected rs value")
+			nhs = append(nhs, nh)
+			listeners = append(listeners, l)
+		}
+		startMemTransportShard(t, nhs, 1)
+		leaderID, _, ok, err := nhs[0].GetLeaderID(1)
+		if err != nil || !ok {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		leader := nhs[leaderID-1]
+		replicaID := leaderID%uint64(len(nhs)) + 1
+		follower := nhs[replicaID-1]
+		ctx, cancel := context.WithTimeout(context.Background(), pto(leader))
+		defer cancel()
+		if err := leader.SyncRequestDeleteReplica(ctx,
+			1, replicaID, 0); err != nil {
+			t.Fatalf("failed to delete replica %v", err)
+		}
+		m, err := leader.SyncGetShardMembership(ctx, 1)
+		if err != nil {
+			t.Fatalf("failed to get membership %v", err)
+		}
+		// events are delivered asynchronously
+		var events []raftio.NodeRemovedInfo
+		for i := 0; len(events) == 0; i++ {
+			if i > 100 {
+				t.Fatalf("no NodeRemovedFromShard event")
+			}
+			time.Sleep(10 * time.Millisecond)
+			events = listeners[replicaID-1].getNodeRemovedEvents()
+		}
+		e := events[0]
+		if e.ShardID != 1 || e.ReplicaID != replicaID ||
+			e.Index != m.ConfigChangeID {
+			t.Errorf("unexpected event %+v, config change index %d",
+				e, m.ConfigChangeID)
+		}
+		for i, l := range listeners {
+			if uint64(i+1) != replicaID && len(l.getNodeRemovedEvents()) != 0 {
+				t.Errorf("unexpected event on replica %d", i+1)
+			}
+		}
+		nhi := follower.GetNodeHostInfo(DefaultNodeHostInfoOption)
+		if len(nhi.ShardInfoList) != 1 || !nhi.ShardInfoList[0].IsRemoved {
+			t.Errorf("replica not shown as removed, %+v", nhi.ShardInfoList)
+		}
+		nhi = leader.GetNodeHostInfo(DefaultNodeHostInfoOption)
+		if len(nhi.ShardInfoList) != 1 || nhi.ShardInfoList[0].IsRemoved {
+			t.Errorf("leader shown as removed, %+v", nhi.ShardInfoList)
+		}
+		_, err = follower.SyncPropose(ctx, follower.GetNoOPSession(1), []byte("a"))
+		if !errors.Is(err, ErrReplicaRemoved) {
+			t.Errorf("unexpected propose error %v", err)
+		}
+		if _, err := follower.SyncRead(ctx, 1, nil); !errors.Is(err, ErrReplicaRemoved) {
+			t.Errorf("unexpected read error %v", err)
+		}
+		if err := follower.StopReplica(1, replicaID); err != nil {
+			t.Fatalf("failed to stop replica %v", err)
+		}
+		if err := follower.SyncRemoveData(ctx, 1, replicaID); err != nil {
+			t.Fatalf("failed to remove data %v", err)
+		}
+	}()
+	reportLeakedFD(fs, t)
+}
+
+func TestTooLargeMembershipIsRejected(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			members := make(map[uint64]string)
+			for replicaID := uint64(1); replicaID <= settings.MaxMembers+1; replicaID++ {
+				members[replicaID] = fmt.Sprintf("localhost:%d", 25000+replicaID)
+			}
+			cfg := getTestConfig()
+			cfg.ShardID = 2
+			create := func(uint64, uint64) sm.IStateMachine { return &PST{} }
+			if err := nh.StartReplica(members,
+				false, create, *cfg); err != ErrMembershipTooLarge {
+				t.Errorf("too many initial members not rejected, %v", err)
+			}
+			long := map[uint64]string{1: nh.RaftAddress(),
+				2: strings.Repeat("a", int(settings.MaxAddressLength)) + ":25002"}
+			if err := nh.StartReplica(long,
+				false, create, *cfg); err != ErrMembershipTooLarge {
+				t.Errorf("overlong initial member address not rejected, %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			delete(members, 1)
+			members[1] = nh.RaftAddress()
+			err := nh.SyncRequestReconfigure(ctx, 1, Membership{Nodes: members}, 0)
+			if !errors.Is(err, ErrMembershipTooLarge) {
+				t.Errorf("too large membership not rejected, %v", err)
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestSnapshotCanBeCompressed(t *testing.T) {
+func TestGetAllMembershipsMatchesShardMembership(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
-		compressed: true,
-		createSM: func(uint64, uint64) sm.IStateMachine {
-			return &tests.VerboseSnapshotSM{}
-		},
+		defaultTestNode: true,
 		tf: func(nh *NodeHost) {
-			pto := lpto(nh)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			_, err := nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption)
-			cancel()
-			if err != nil {
-				t.Fatalf("failed to request snapshot %v", err)
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			if err := nh.SyncRequestAddNonVoting(ctx, 1, 2, "localhost:25002", 0); err != nil {
+				t.Fatalf("failed to add nonVoting %v", err)
 			}
-			logdb := nh.mu.logdb
-			ss, err := logdb.GetSnapshot(1, 1)
-			if err != nil {
-				t.Fatalf("failed to list snapshots: %v", err)
+			newSM := func(uint64, uint64) sm.IStateMachine {
+				return &tests.NoOP{}
 			}
-			if pb.IsEmptySnapshot(ss) {
-				t.Fatalf("failed to get snapshot rec")
+			single := map[uint64]string{1: nh.RaftAddress()}
+			rc := *getTestConfig()
+			rc.ShardID = 2
+			if err := nh.StartReplica(single, false, newSM, rc); err != nil {
+				t.Fatalf("failed to start shard %v", err)
 			}
-			fi, err := fs.Stat(ss.Filepath)
-			if err != nil {
-				t.Fatalf("failed to get file path %v", err)
+			// shard 3 has no leader as its other replica is never started
+			rc.ShardID = 3
+			pair := map[uint64]string{1: nh.RaftAddress(), 2: "localhost:25002"}
+			if err := nh.StartReplica(pair, false, newSM, rc); err != nil {
+				t.Fatalf("failed to start shard %v", err)
 			}
-			if fi.Size() > 1024*364 {
-				t.Errorf("snapshot file not compressed, sz %d", fi.Size())
+			waitForLeaderToBeElected(t, nh, 2)
+			var all map[uint64]*Membership
+			for i := 0; i < 100; i++ {
+				if all = nh.GetAllMemberships(MembershipQueryOption{}); len(all) == 3 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if len(all) != 3 {
+				t.Fatalf("unexpected memberships %v", all)
+			}
+			for _, shardID := range []uint64{1, 2} {
+				m, err := nh.SyncGetShardMembership(ctx, shardID)
+				if err != nil {
+					t.Fatalf("failed to get membership %v", err)
+				}
+				if !reflect.DeepEqual(m, all[shardID]) {
+					t.Errorf("shard %d, membership %+v, want %+v",
+						shardID, all[shardID], m)
+				}
+			}
+			if len(all[1].NonVotings) != 1 || all[1].ConfigChangeID == 0 {
+				t.Errorf("unexpected membership %+v", all[1])
+			}
+			if len(all[3].Nodes) != 2 {
+				t.Errorf("unexpected membership %+v", all[3])
+			}
+			led := nh.GetAllMemberships(MembershipQueryOption{LeaderOnly: true})
+			if len(led) != 2 || led[1] == nil || led[2] == nil {
+				t.Errorf("unexpected memberships %v", led)
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func makeProposals(nh *NodeHost) {
-	session := nh.GetNoOPSession(1)
-	pto := pto(nh)
-	for i := 0; i < 16; i++ {
-		ctx, cancel := context.WithTimeout(context.Background(), pto)
-		_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
-		cancel()
-		if err != nil {
-			time.Sleep(100 * time.Millisecond)
-		}
-	}
-}
-
-func testWitnessIO(t *testing.T,
-	witnessTestFunc func(*NodeHost, *NodeHost, *tests.SimDiskSM), fs vfs.IFS) {
+func TestNonVotingLagIsReported(t *testing.T) {
+	fs := vfs.GetTestFS()
 	tf := func() {
 		rc := config.Config{
-			ShardID:      1,
-			ReplicaID:    1,
-			ElectionRTT:  3,
-			HeartbeatRTT: 1,
-			CheckQuorum:  true,
+			ShardID:                  1,
+			ReplicaID:                1,
+			ElectionRTT:              10,
+			HeartbeatRTT:             1,
+			CheckQuorum:              true,
+			NonVotingLagAlertEntries: 5,
+			NonVotingLagAlertRTT:     1,
 		}
 		peers := make(map[uint64]string)
 		peers[1] = nodeHostTestAddr1
 		dir := fs.PathJoin(singleNodeHostTestDir, "nh1")
+		listener := &testSysEventListener{}
 		nhc1 := config.NodeHostConfig{
-			NodeHostDir:    dir,
-			RTTMillisecond: getRTTMillisecond(fs, dir),
-			RaftAddress:    nodeHostTestAddr1,
-			Expert:         getTestExpertConfig(fs),
+			NodeHostDir:         dir,
+			RTTMillisecond:      getRTTMillisecond(fs, dir),
+			RaftAddress:         nodeHostTestAddr1,
+			Expert:              getTestExpertConfig(fs),
+			SystemEventListener: listener,
 		}
 		nh1, err := NewNodeHost(nhc1)
 		if err != nil {
 			t.Fatalf("failed to create node host %v", err)
 		}
 		defer nh1.Close()
-		newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
-			return tests.NewSimDiskSM(0)
+		newSM := func(uint64, uint64) sm.IStateMachine {
+			return &tests.NoOP{}
 		}
-		if err := nh1.StartOnDiskReplica(peers, false, newSM, rc); err != nil {
+		if err := nh1.StartReplica(peers, false, newSM, rc); err != nil {
 			t.Fatalf("failed to start shard %v", err)
 		}
 		waitForLeaderToBeElected(t, nh1, 1)
-		for i := 0; i < 8; i++ {
-			makeProposals(nh1)
-			pto := lpto(nh1)
-			ctx, cancel := context.WithTimeout(context.Background(), pto)
-			opt := SnapshotOption{OverrideCompactionOverhead: true, CompactionOverhead: 1}
-			if _, err := nh1.SyncRequestSnapshot(ctx, 1, opt); err != nil {
-				t.Fatalf("failed to request snapshot %v", err)
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh1))
+		if err := nh1.SyncRequestAddNonVoting(ctx, 1, 2, nodeHostTestAddr2, 0); err != nil {
+			t.Fatalf("failed to add nonVoting %v", err)
+		}
+		cancel()
+		makeProposals(nh1)
+		for i := 0; i < 100; i++ {
+			if lagging, _ := listener.getNonVotingLagEvents(); len(lagging) > 0 {
+				break
 			}
-			cancel()
+			time.Sleep(20 * time.Millisecond)
+		}
+		lagging, _ := listener.getNonVotingLagEvents()
+		if len(lagging) != 1 || lagging[0].ReplicaID != 2 || lagging[0].Lag <= 5 {
+			t.Fatalf("unexpected lagging events %v", lagging)
+		}
+		progress, err := nh1.GetNonVotingProgress(1)
+		if err != nil {
+			t.Fatalf("failed to get nonVoting progress %v", err)
+		}
+		if p, ok := progress[2]; !ok || p.Lag <= 5 {
+			t.Fatalf("unexpected progress %v", progress)
+		}
+		// the nonVoting has its log replicated quickly but applies slowly
+		rc2 := rc
+		rc2.ReplicaID = 2
+		rc2.IsNonVoting = true
+		nhc2 := nhc1
+		nhc2.RaftAddress = nodeHostTestAddr2
+		nhc2.NodeHostDir = fs.PathJoin(singleNodeHostTestDir, "nh2")
+		nhc2.SystemEventListener = nil
+		nh2, err := NewNodeHost(nhc2)
+		if err != nil {
+			t.Fatalf("failed to create node host %v", err)
+		}
+		defer nh2.Close()
+		slowSM := func(uint64, uint64) sm.IStateMachine {
+			return &TimeoutStateMachine{updateDelay: 50}
+		}
+		if err := nh2.StartReplica(nil, true, slowSM, rc2); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		if _, err := nh2.GetNonVotingProgress(1); err == nil {
+			t.Errorf("nonVoting progress returned by nonVoting")
+		}
+		lagObserved := false
+		for i := 0; i < 200; i++ {
+			lag, err := nh2.GetLocalLag(1)
+			if err == nil && lag > 0 {
+				lagObserved = true
+			}
+			_, recovered := listener.getNonVotingLagEvents()
+			if lagObserved && err == nil && lag == 0 && len(recovered) > 0 {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		_, recovered := listener.getNonVotingLagEvents()
+		t.Fatalf("lag observed %t, recovered events %v", lagObserved, recovered)
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
+func TestMismatchedInitialMembersAreContained(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		start := func(replicaID uint64,
+			peers map[uint64]string) (*NodeHost, *testSysEventListener) {
+			rc := config.Config{
+				ShardID:      1,
+				ReplicaID:    replicaID,
+				ElectionRTT:  10,
+				HeartbeatRTT: 1,
+			}
+			dir := fs.PathJoin(singleNodeHostTestDir, fmt.Sprintf("nh%d", replicaID))
+			listener := &testSysEventListener{}
+			nhc := config.NodeHostConfig{
+				NodeHostDir:         dir,
+				RTTMillisecond:      getRTTMillisecond(fs, dir),
+				RaftAddress:         peers[replicaID],
+				Expert:              getTestExpertConfig(fs),
+				SystemEventListener: listener,
+			}
+			nh, err := NewNodeHost(nhc)
+			if err != nil {
+				t.Fatalf("failed to create node host %v", err)
+			}
+			newSM := func(uint64, uint64) sm.IStateMachine {
+				return &tests.NoOP{}
+			}
+			if err := nh.StartReplica(peers, false, newSM, rc); err != nil {
+				t.Fatalf("failed to start shard %v", err)
+			}
+			return nh, listener
+		}
+		nh1, l1 := start(1, map[uint64]string{
+			1: nodeHostTestAddr1,
+			2: nodeHostTestAddr2,
+		})
+		defer nh1.Close()
+		nh2, l2 := start(2, map[uint64]string{
+			1: nodeHostTestAddr1,
+			2: nodeHostTestAddr2,
+			3: nodeHostTestAddr3,
+		})
+		defer nh2.Close()
+		for i := 0; i < 200; i++ {
+			if len(l1.getBootstrapMismatch()) > 0 &&
+				len(l2.getBootstrapMismatch()) > 0 {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		m1 := l1.getBootstrapMismatch()
+		m2 := l2.getBootstrapMismatch()
+		if len(m1) != 1 || len(m2) != 1 {
+			t.Fatalf("mismatch not reported, %v, %v", m1, m2)
+		}
+		if m1[0].From != 2 || m1[0].LocalHash != m2[0].RemoteHash ||
+			m1[0].RemoteHash != m2[0].LocalHash || m1[0].LocalHash == m1[0].RemoteHash {
+			t.Errorf("unexpected mismatch info %+v, %+v", m1[0], m2[0])
+		}
+		for _, nh := range []*NodeHost{nh1, nh2} {
+			if _, _, ok, err := nh.GetLeaderID(1); err != nil || ok {
+				t.Errorf("leader unexpectedly elected, %v", err)
+			}
+		}
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
+func startTimingTestNodeHost(t *testing.T, fs vfs.IFS, replicaID uint64,
+	rttMillisecond uint64, election time.Duration,
+	heartbeat time.Duration) (*NodeHost, *testSysEventListener) {
+	peers := map[uint64]string{
+		1: nodeHostTestAddr1,
+		2: nodeHostTestAddr2,
+		3: nodeHostTestAddr3,
+	}
+	rc := config.Config{
+		ShardID:           1,
+		ReplicaID:         replicaID,
+		ElectionTimeout:   election,
+		HeartbeatInterval: heartbeat,
+		CheckQuorum:       true,
+	}
+	dir := fs.PathJoin(singleNodeHostTestDir, fmt.Sprintf("nh%d", replicaID))
+	listener := &testSysEventListener{}
+	nhc := config.NodeHostConfig{
+		NodeHostDir:         dir,
+		RTTMillisecond:      rttMillisecond,
+		RaftAddress:         peers[replicaID],
+		Expert:              getTestExpertConfig(fs),
+		SystemEventListener: listener,
+	}
+	nh, err := NewNodeHost(nhc)
+	if err != nil {
+		t.Fatalf("failed to create node host %v", err)
+	}
+	newSM := func(uint64, uint64) sm.IStateMachine {
+		return &tests.NoOP{}
+	}
+	if err := nh.StartReplica(peers, false, newSM, rc); err != nil {
+		nh.Close()
+		t.Fatalf("failed to start shard %v", err)
+	}
+	return nh, listener
+}
+
+func TestReplicasWithDifferentRTTMillisecondHaveStableLeadership(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		var nhs []*NodeHost
+		for idx, rtt := range []uint64{5, 20, 50} {
+			nh, _ := startTimingTestNodeHost(t, fs, uint64(idx+1),
+				rtt, time.Second, 50*time.Millisecond)
+			defer nh.Close()
+			nhs = append(nhs, nh)
 		}
-		pto := pto(nh1)
-		ctx, cancel := context.WithTimeout(context.Background(), pto)
-		if err := nh1.SyncRequestAddWitness(ctx, 1, 2, nodeHostTestAddr2, 0); err != nil {
-			t.Fatalf("failed to add witness %v", err)
+		for idx, want := range [][2]uint64{{200, 10}, {50, 2}, {20, 1}} {
+			n, ok := nhs[idx].getShard(1)
+			if !ok {
+				t.Fatalf("failed to get shard")
+			}
+			if n.config.ElectionRTT != want[0] || n.config.HeartbeatRTT != want[1] {
+				t.Errorf("unexpected ticks %d, %d",
+					n.config.ElectionRTT, n.config.HeartbeatRTT)
+			}
 		}
-		cancel()
-		rc2 := rc
-		rc2.ReplicaID = 2
-		rc2.IsWitness = true
-		nhc2 := nhc1
-		nhc2.RaftAddress = nodeHostTestAddr2
-		nhc2.NodeHostDir = fs.PathJoin(singleNodeHostTestDir, "nh2")
-		nh2, err := NewNodeHost(nhc2)
+		waitForLeaderToBeElected(t, nhs[0], 1)
+		leaderID, term, _, err := nhs[0].GetLeaderID(1)
 		if err != nil {
-			t.Fatalf("failed to create node host %v", err)
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		// several election timeouts
+		time.Sleep(4 * time.Second)
+		for _, nh := range nhs {
+			id, tm, ok, err := nh.GetLeaderID(1)
+			if err != nil || !ok || id != leaderID || tm != term {
+				t.Errorf("leadership changed, %d/%d, %d/%d, %v",
+					id, tm, leaderID, term, err)
+			}
 		}
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
+func TestIncompatibleTimingsAreContained(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		nh1, l1 := startTimingTestNodeHost(t, fs, 1,
+			10, 200*time.Millisecond, 20*time.Millisecond)
+		defer nh1.Close()
+		nh2, l2 := startTimingTestNodeHost(t, fs, 2,
+			10, 2*time.Second, 500*time.Millisecond)
 		defer nh2.Close()
-		witness := tests.NewSimDiskSM(0)
-		newWitness := func(uint64, uint64) sm.IOnDiskStateMachine {
-			return witness
+		for i := 0; i < 200; i++ {
+			if len(l1.getBootstrapMismatch()) > 0 {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
 		}
-		if err := nh2.StartOnDiskReplica(nil, true, newWitness, rc2); err != nil {
-			t.Fatalf("failed to start shard %v", err)
+		m1 := l1.getBootstrapMismatch()
+		if len(m1) != 1 {
+			t.Fatalf("mismatch not reported, %v", m1)
+		}
+		if m1[0].From != 2 || m1[0].LocalHash != 0 ||
+			m1[0].LocalElectionTimeout != 200*time.Millisecond ||
+			m1[0].RemoteHeartbeatInterval != 500*time.Millisecond {
+			t.Errorf("unexpected mismatch info %+v", m1[0])
+		}
+		if m2 := l2.getBootstrapMismatch(); len(m2) != 0 {
+			t.Errorf("unexpected mismatch %v", m2)
 		}
-		waitForLeaderToBeElected(t, nh2, 1)
-		witnessTestFunc(nh1, nh2, witness)
 	}
 	runNodeHostTestDC(t, tf, true, fs)
 }
 
-func TestWitnessSnapshotIsCorrectlyHandled(t *testing.T) {
+func TestMismatchedLocalInitialMembersAreRejected(t *testing.T) {
 	fs := vfs.GetTestFS()
-	tf := func(nh1 *NodeHost, nh2 *NodeHost, witness *tests.SimDiskSM) {
-		for {
-			if witness.GetRecovered() > 0 {
-				t.Fatalf("unexpected recovered count %d", witness.GetRecovered())
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			if err := nh.StopShard(1); err != nil {
+				t.Fatalf("failed to stop shard %v", err)
 			}
-			snapshot, err := nh2.mu.logdb.GetSnapshot(1, 2)
-			if err != nil {
-				t.Fatalf("%v", err)
+			rc := *getTestConfig()
+			rc.ReplicaID = 2
+			peers := map[uint64]string{2: nh.RaftAddress(), 3: "localhost:25003"}
+			newSM := func(uint64, uint64) sm.IStateMachine {
+				return &tests.NoOP{}
 			}
-			if pb.IsEmptySnapshot(snapshot) {
-				time.Sleep(100 * time.Millisecond)
-			} else {
-				if !snapshot.Witness {
-					t.Errorf("not a witness snapshot")
-				}
-				return
+			err := nh.StartReplica(peers, false, newSM, rc)
+			if !errors.Is(err, ErrInvalidShardSettings) {
+				t.Fatalf("mismatched initial members not rejected, %v", err)
 			}
-		}
+		},
 	}
-	testWitnessIO(t, tf, fs)
+	runNodeHostTest(t, to, fs)
 }
 
-func TestWitnessCanReplicateEntries(t *testing.T) {
+func TestMismatchedWriteFsyncModeIsRejected(t *testing.T) {
 	fs := vfs.GetTestFS()
-	tf := func(nh1 *NodeHost, nh2 *NodeHost, witness *tests.SimDiskSM) {
-		for i := 0; i < 8; i++ {
-			makeProposals(nh1)
-		}
-		if witness.GetApplied() > 0 {
-			t.Fatalf("unexpected applied count %d", witness.GetApplied())
-		}
+	to := &testOption{
+		defaultTestNode: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.WriteFsyncMode = config.RelaxedFsync
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			if !makeTestProposal(nh, 10) {
+				t.Fatalf("failed to make proposal")
+			}
+			bi, err := nh.mu.logdb.GetBootstrapInfo(1, 1)
+			if err != nil {
+				t.Fatalf("failed to get bootstrap info %v", err)
+			}
+			if bi.WriteFsyncMode != uint32(config.RelaxedFsync) {
+				t.Errorf("write fsync mode not recorded")
+			}
+			if err := nh.StopShard(1); err != nil {
+				t.Fatalf("failed to stop shard %v", err)
+			}
+			rc := *getTestConfig()
+			newSM := func(uint64, uint64) sm.IStateMachine {
+				return &tests.NoOP{}
+			}
+			for i := 0; ; i++ {
+				err := nh.StartReplica(nil, false, newSM, rc)
+				if err == ErrInvalidShardSettings {
+					break
+				}
+				if err != ErrShardAlreadyExist || i > 100 {
+					t.Fatalf("mismatched write fsync mode not rejected, %v", err)
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		},
 	}
-	testWitnessIO(t, tf, fs)
+	runNodeHostTest(t, to, fs)
 }
 
 func TestWitnessCanNotInitiateIORequest(t *testing.T) {
@@ -5780,414 +9335,1218 @@ func TestUsingClosedNodeHostIsNotAllowed(t *testing.T) {
 			if err := nh.RequestLeaderTransfer(1, 2); err != ErrClosed {
 				t.Errorf("failed to return ErrClosed")
 			}
+			opt := LeaderTransferOption{}
+			if err := nh.SyncRequestLeaderTransfer(ctx, 1, 2, opt); err != ErrClosed {
+				t.Errorf("failed to return ErrClosed")
+			}
 			if err := nh.SyncRemoveData(ctx, 1, 1); err != ErrClosed {
 				t.Errorf("failed to return ErrClosed")
 			}
 			if err := nh.RemoveData(1, 1); err != ErrClosed {
 				t.Errorf("failed to return ErrClosed")
 			}
-			if _, err := nh.GetNodeUser(1); err != ErrClosed {
-				t.Errorf("failed to return ErrClosed")
+			if _, err := nh.GetNodeUser(1); err != ErrClosed {
+				t.Errorf("failed to return ErrClosed")
+			}
+			if _, err := nh.QueryRaftLog(1, 1, 2, 100); err != ErrClosed {
+				t.Errorf("failed to return ErrClosed")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestContextDeadlineIsChecked(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			ctx := context.Background()
+			if _, err := nh.SyncPropose(ctx, nil, nil); err != ErrDeadlineNotSet {
+				t.Errorf("ctx deadline not checked")
+			}
+			if _, err := nh.SyncRead(ctx, 1, nil); err != ErrDeadlineNotSet {
+				t.Errorf("ctx deadline not checked")
+			}
+			if _, err := nh.SyncGetShardMembership(ctx, 1); err != ErrDeadlineNotSet {
+				t.Errorf("ctx deadline not checked")
+			}
+			if err := nh.SyncCloseSession(ctx, nil); err != ErrDeadlineNotSet {
+				t.Errorf("ctx deadline not checked")
+			}
+			if _, err := nh.SyncGetSession(ctx, 1); err != ErrDeadlineNotSet {
+				t.Errorf("ctx deadline not checked")
+			}
+			if err := nh.SyncCloseSession(ctx, nil); err != ErrDeadlineNotSet {
+				t.Errorf("ctx deadline not checked")
+			}
+			if _, err := nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption); err != ErrDeadlineNotSet {
+				t.Errorf("ctx deadline not checked")
+			}
+			if err := nh.SyncRequestDeleteReplica(ctx, 1, 1, 0); err != ErrDeadlineNotSet {
+				t.Errorf("ctx deadline not checked")
+			}
+			if err := nh.SyncRequestAddReplica(ctx, 1, 2, "", 0); err != ErrDeadlineNotSet {
+				t.Errorf("ctx deadline not checked")
+			}
+			if err := nh.SyncRequestAddNonVoting(ctx, 1, 2, "", 0); err != ErrDeadlineNotSet {
+				t.Errorf("ctx deadline not checked")
+			}
+			if err := nh.SyncRequestAddWitness(ctx, 1, 2, "", 0); err != ErrDeadlineNotSet {
+				t.Errorf("ctx deadline not checked")
+			}
+			if err := nh.SyncRemoveData(ctx, 1, 1); err != ErrDeadlineNotSet {
+				t.Errorf("ctx deadline not checked")
+			}
+			opt := LeaderTransferOption{}
+			if err := nh.SyncRequestLeaderTransfer(ctx, 1, 2, opt); err != ErrDeadlineNotSet {
+				t.Errorf("ctx deadline not checked")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestGetTimeoutFromContext(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	if _, err := getTimeoutFromContext(context.Background()); err != ErrDeadlineNotSet {
+		t.Errorf("failed to return ErrDeadlineNotSet, %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	d, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		t.Errorf("failed to get timeout, %v", err)
+	}
+	if d < 55*time.Second {
+		t.Errorf("unexpected result")
+	}
+}
+
+func TestHandleSnapshotStatus(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	nh := &NodeHost{stopper: syncutil.NewStopper()}
+	engine := newExecEngine(nh, config.GetDefaultExpertConfig(), false, false, nil, nil, nil, false, nil)
+	defer func() {
+		if err := engine.close(); err != nil {
+			t.Fatalf("failed to close engine %v", err)
+		}
+	}()
+	nh.engine = engine
+	nh.events.sys = newSysEventListener(nil, 0)
+	h := messageHandler{nh: nh}
+	mq := server.NewMessageQueue(1024, false, lazyFreeCycle, 1024)
+	node := &node{shardID: 1, replicaID: 1, mq: mq}
+	h.nh.mu.shards.Store(uint64(1), node)
+	h.HandleSnapshotStatus(1, 2, true)
+	for i := uint64(0); i <= streamPushDelayTick; i++ {
+		node.mq.Tick()
+	}
+	msgs := node.mq.Get()
+	if len(msgs) != 1 {
+		t.Fatalf("no msg")
+	}
+	if msgs[0].Type != pb.SnapshotStatus || !msgs[0].Reject {
+		t.Fatalf("unexpected message")
+	}
+}
+
+func TestSnapshotReceivedMessageCanBeConverted(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	nh := &NodeHost{stopper: syncutil.NewStopper()}
+	engine := newExecEngine(nh, config.GetDefaultExpertConfig(), false, false, nil, nil, nil, false, nil)
+	defer func() {
+		if err := engine.close(); err != nil {
+			t.Fatalf("failed to close engine %v", err)
+		}
+	}()
+	nh.engine = engine
+	nh.events.sys = newSysEventListener(nil, 0)
+	h := messageHandler{nh: nh}
+	mq := server.NewMessageQueue(1024, false, lazyFreeCycle, 1024)
+	node := &node{shardID: 1, replicaID: 1, mq: mq}
+	h.nh.mu.shards.Store(uint64(1), node)
+	mb := pb.MessageBatch{
+		Requests: []pb.Message{{To: 1, From: 2, ShardID: 1, Type: pb.SnapshotReceived}},
+	}
+	sc, mc := h.HandleMessageBatch(mb)
+	if sc != 0 || mc != 1 {
+		t.Errorf("failed to handle message batch")
+	}
+	for i := uint64(0); i <= streamConfirmedDelayTick; i++ {
+		node.mq.Tick()
+	}
+	msgs := node.mq.Get()
+	if len(msgs) != 1 {
+		t.Fatalf("no msg")
+	}
+	if msgs[0].Type != pb.SnapshotStatus || msgs[0].Reject {
+		t.Fatalf("unexpected message")
+	}
+}
+
+func TestIncorrectlyRoutedMessagesAreIgnored(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	nh := &NodeHost{stopper: syncutil.NewStopper()}
+	engine := newExecEngine(nh, config.GetDefaultExpertConfig(), false, false, nil, nil, nil, false, nil)
+	defer func() {
+		if err := engine.close(); err != nil {
+			t.Fatalf("failed to close engine %v", err)
+		}
+	}()
+	nh.engine = engine
+	nh.events.sys = newSysEventListener(nil, 0)
+	h := messageHandler{nh: nh}
+	mq := server.NewMessageQueue(1024, false, lazyFreeCycle, 1024)
+	node := &node{shardID: 1, replicaID: 1, mq: mq}
+	h.nh.mu.shards.Store(uint64(1), node)
+	mb := pb.MessageBatch{
+		Requests: []pb.Message{{To: 3, From: 2, ShardID: 1, Type: pb.SnapshotReceived}},
+	}
+	sc, mc := h.HandleMessageBatch(mb)
+	if sc != 0 || mc != 0 {
+		t.Errorf("failed to ignore the message")
+	}
+	msgs := node.mq.Get()
+	if len(msgs) != 0 {
+		t.Fatalf("received unexpected message")
+	}
+}
+
+func TestProposeOnClosedNode(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			u, err := nh.GetNodeUser(1)
+			if err != nil {
+				t.Fatalf("failed to get node, %v", err)
+			}
+			if err := nh.StopReplica(1, 1); err != nil {
+				t.Fatalf("failed to stop node, %v", err)
 			}
-			if _, err := nh.QueryRaftLog(1, 1, 2, 100); err != ErrClosed {
-				t.Errorf("failed to return ErrClosed")
+			cs := nh.GetNoOPSession(1)
+			if _, err := u.Propose(cs, nil, time.Second); err == nil {
+				t.Errorf("propose on closed node didn't cause error")
+			} else {
+				plog.Infof("%v returned from closed node", err)
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestContextDeadlineIsChecked(t *testing.T) {
+func TestReadIndexOnClosedNode(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
 		defaultTestNode: true,
 		tf: func(nh *NodeHost) {
-			ctx := context.Background()
-			if _, err := nh.SyncPropose(ctx, nil, nil); err != ErrDeadlineNotSet {
-				t.Errorf("ctx deadline not checked")
-			}
-			if _, err := nh.SyncRead(ctx, 1, nil); err != ErrDeadlineNotSet {
-				t.Errorf("ctx deadline not checked")
-			}
-			if _, err := nh.SyncGetShardMembership(ctx, 1); err != ErrDeadlineNotSet {
-				t.Errorf("ctx deadline not checked")
-			}
-			if err := nh.SyncCloseSession(ctx, nil); err != ErrDeadlineNotSet {
-				t.Errorf("ctx deadline not checked")
+			u, err := nh.GetNodeUser(1)
+			if err != nil {
+				t.Fatalf("failed to get node, %v", err)
 			}
-			if _, err := nh.SyncGetSession(ctx, 1); err != ErrDeadlineNotSet {
-				t.Errorf("ctx deadline not checked")
+			if err := nh.StopReplica(1, 1); err != nil {
+				t.Fatalf("failed to stop node, %v", err)
 			}
-			if err := nh.SyncCloseSession(ctx, nil); err != ErrDeadlineNotSet {
-				t.Errorf("ctx deadline not checked")
+			if _, err := u.ReadIndex(time.Second); err == nil {
+				t.Errorf("ReadIndex on closed node didn't cause error")
+			} else {
+				plog.Infof("%v returned from closed node", err)
 			}
-			if _, err := nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption); err != ErrDeadlineNotSet {
-				t.Errorf("ctx deadline not checked")
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestNodeCanNotStartWhenStillLoadedInEngine(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			nodes := make(map[uint64]*node)
+			nodes[2] = &node{shardID: 2, replicaID: 1}
+			nh.engine.loaded.update(1, fromStepWorker, nodes)
+			if err := nh.startShard(nil, false, nil,
+				config.Config{ShardID: 2, ReplicaID: 1},
+				pb.RegularStateMachine); err != ErrShardAlreadyExist {
+				t.Errorf("failed to return ErrShardAlreadyExist, %v", err)
 			}
-			if err := nh.SyncRequestDeleteReplica(ctx, 1, 1, 0); err != ErrDeadlineNotSet {
-				t.Errorf("ctx deadline not checked")
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestBootstrapInfoIsValidated(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			if _, _, err := nh.bootstrapShard(nil, false,
+				config.Config{ShardID: 1, ReplicaID: 1},
+				pb.OnDiskStateMachine); err != ErrInvalidShardSettings {
+				t.Errorf("failed to fail the boostrap, %v", err)
 			}
-			if err := nh.SyncRequestAddReplica(ctx, 1, 2, "", 0); err != ErrDeadlineNotSet {
-				t.Errorf("ctx deadline not checked")
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+// slow tests
+
+type stressRSM struct{}
+
+func (s *stressRSM) Update(sm.Entry) (sm.Result, error) {
+	plog.Infof("updated")
+	return sm.Result{}, nil
+}
+
+func (s *stressRSM) Lookup(interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func (s *stressRSM) SaveSnapshot(w io.Writer,
+	f sm.ISnapshotFileCollection, c <-chan struct{}) error {
+	data := make([]byte, settings.SnapshotChunkSize*3)
+	_, err := w.Write(data)
+	return err
+}
+
+func (s *stressRSM) RecoverFromSnapshot(r io.Reader,
+	f []sm.SnapshotFile, c <-chan struct{}) error {
+	plog.Infof("RecoverFromSnapshot called")
+	data := make([]byte, settings.SnapshotChunkSize*3)
+	n, err := io.ReadFull(r, data)
+	if uint64(n) != settings.SnapshotChunkSize*3 {
+		return errors.New("unexpected size")
+	}
+	return err
+}
+
+func (s *stressRSM) Close() error {
+	return nil
+}
+
+// this test takes around 6 minutes on mbp and 30 seconds on a linux box with
+// proper SSD
+func TestSlowTestStressedSnapshotWorker(t *testing.T) {
+	if len(os.Getenv("SLOW_TEST")) == 0 {
+		t.Skip("skipped TestSlowTestStressedSnapshotWorker, SLOW_TEST not set")
+	}
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	nh1dir := fs.PathJoin(singleNodeHostTestDir, "nh1")
+	nh2dir := fs.PathJoin(singleNodeHostTestDir, "nh2")
+	rc := config.Config{
+		ShardID:            1,
+		ReplicaID:          1,
+		ElectionRTT:        10,
+		HeartbeatRTT:       1,
+		CheckQuorum:        true,
+		SnapshotEntries:    5,
+		CompactionOverhead: 1,
+	}
+	peers := make(map[uint64]string)
+	peers[1] = nodeHostTestAddr1
+	nhc1 := config.NodeHostConfig{
+		WALDir:         nh1dir,
+		NodeHostDir:    nh1dir,
+		RTTMillisecond: 5 * getRTTMillisecond(fs, nh1dir),
+		RaftAddress:    nodeHostTestAddr1,
+		Expert:         getTestExpertConfig(fs),
+	}
+	nh1, err := NewNodeHost(nhc1)
+	if err != nil {
+		t.Fatalf("failed to create node host %v", err)
+	}
+	defer nh1.Close()
+	newRSM := func(uint64, uint64) sm.IStateMachine {
+		return &stressRSM{}
+	}
+	for i := uint64(1); i <= uint64(96); i++ {
+		rc.ShardID = i
+		if err := nh1.StartReplica(peers, false, newRSM, rc); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		cs := nh1.GetNoOPSession(i)
+		total := 20
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			_, err := nh1.SyncPropose(ctx, cs, make([]byte, 1))
+			cancel()
+			if err == ErrTimeout || err == ErrShardNotReady {
+				time.Sleep(100 * time.Millisecond)
+				continue
 			}
-			if err := nh.SyncRequestAddNonVoting(ctx, 1, 2, "", 0); err != ErrDeadlineNotSet {
-				t.Errorf("ctx deadline not checked")
+			total--
+			if total == 0 {
+				break
 			}
-			if err := nh.SyncRequestAddWitness(ctx, 1, 2, "", 0); err != ErrDeadlineNotSet {
-				t.Errorf("ctx deadline not checked")
+		}
+	}
+	// add another node
+	for i := uint64(1); i <= uint64(96); i++ {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			err := nh1.SyncRequestAddReplica(ctx, i, 2, nodeHostTestAddr2, 0)
+			cancel()
+			if err != nil {
+				if err == ErrTimeout || err == ErrShardNotReady {
+					time.Sleep(100 * time.Millisecond)
+					continue
+				} else {
+					t.Fatalf("failed to add node %v", err)
+				}
+			} else {
+				break
 			}
-			if err := nh.SyncRemoveData(ctx, 1, 1); err != ErrDeadlineNotSet {
-				t.Errorf("ctx deadline not checked")
+		}
+	}
+	plog.Infof("all nodes added")
+	nhc2 := config.NodeHostConfig{
+		WALDir:         nh2dir,
+		NodeHostDir:    nh2dir,
+		RTTMillisecond: 5 * getRTTMillisecond(fs, nh2dir),
+		RaftAddress:    nodeHostTestAddr2,
+		Expert:         getTestExpertConfig(fs),
+	}
+	nh2, err := NewNodeHost(nhc2)
+	if err != nil {
+		t.Fatalf("failed to create node host 2 %v", err)
+	}
+	// start new nodes
+	defer nh2.Close()
+	for i := uint64(1); i <= uint64(96); i++ {
+		rc.ShardID = i
+		rc.ReplicaID = 2
+		peers := make(map[uint64]string)
+		if err := nh2.StartReplica(peers, true, newRSM, rc); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+	}
+	for i := uint64(1); i <= uint64(96); i++ {
+		cs := nh2.GetNoOPSession(i)
+		total := 1000
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			_, err := nh2.SyncPropose(ctx, cs, make([]byte, 1))
+			cancel()
+			if err != nil {
+				if err == ErrTimeout || err == ErrShardNotReady {
+					total--
+					if total == 0 {
+						t.Fatalf("failed to make proposal on shard %d", i)
+					}
+					time.Sleep(100 * time.Millisecond)
+					continue
+				} else {
+					t.Fatalf("failed to make proposal %v", err)
+				}
+			} else {
+				break
 			}
-		},
+		}
 	}
-	runNodeHostTest(t, to, fs)
 }
 
-func TestGetTimeoutFromContext(t *testing.T) {
-	defer leaktest.AfterTest(t)()
-	if _, err := getTimeoutFromContext(context.Background()); err != ErrDeadlineNotSet {
-		t.Errorf("failed to return ErrDeadlineNotSet, %v", err)
+// largeSnapshotSM is a state machine with a large snapshot, it is used for
+// testing snapshot transfers.
+type largeSnapshotSM struct {
+	size  int
+	count uint64
+}
+
+func (s *largeSnapshotSM) Lookup(key interface{}) (interface{}, error) {
+	return atomic.LoadUint64(&s.count), nil
+}
+
+func (s *largeSnapshotSM) Update(e sm.Entry) (sm.Result, error) {
+	atomic.AddUint64(&s.count, 1)
+	return sm.Result{Value: uint64(len(e.Cmd))}, nil
+}
+
+func (s *largeSnapshotSM) SaveSnapshot(w io.Writer,
+	fileCollection sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	data := make([]byte, s.size)
+	if _, err := rand.Read(data); err != nil {
+		return err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
-	d, err := getTimeoutFromContext(ctx)
+	binary.BigEndian.PutUint64(data, atomic.LoadUint64(&s.count))
+	_, err := w.Write(data)
+	return err
+}
+
+func (s *largeSnapshotSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	data, err := io.ReadAll(r)
 	if err != nil {
-		t.Errorf("failed to get timeout, %v", err)
+		return err
 	}
-	if d < 55*time.Second {
-		t.Errorf("unexpected result")
+	if len(data) != s.size {
+		return errors.New("unexpected snapshot size")
 	}
+	atomic.StoreUint64(&s.count, binary.BigEndian.Uint64(data))
+	return nil
 }
 
-func TestHandleSnapshotStatus(t *testing.T) {
+func (s *largeSnapshotSM) Close() error { return nil }
+
+func TestSnapshotAndAppendsCanShareMultiplexedConnection(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
 	defer leaktest.AfterTest(t)()
-	nh := &NodeHost{stopper: syncutil.NewStopper()}
-	engine := newExecEngine(nh, config.GetDefaultEngineConfig(), false, false, nil, nil)
+	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	addrs := []string{nodeHostTestAddr1, nodeHostTestAddr2, nodeHostTestAddr3}
+	nhs := make([]*NodeHost, 0)
 	defer func() {
-		if err := engine.close(); err != nil {
-			t.Fatalf("failed to close engine %v", err)
+		for _, nh := range nhs {
+			nh.Close()
 		}
 	}()
-	nh.engine = engine
-	nh.events.sys = newSysEventListener(nil, nh.stopper.ShouldStop())
-	h := messageHandler{nh: nh}
-	mq := server.NewMessageQueue(1024, false, lazyFreeCycle, 1024)
-	node := &node{shardID: 1, replicaID: 1, mq: mq}
-	h.nh.mu.shards.Store(uint64(1), node)
-	h.HandleSnapshotStatus(1, 2, true)
-	for i := uint64(0); i <= streamPushDelayTick; i++ {
-		node.mq.Tick()
+	for idx, addr := range addrs {
+		dir := fs.PathJoin(singleNodeHostTestDir, fmt.Sprintf("nh%d", idx+1))
+		nhc := config.NodeHostConfig{
+			WALDir:              dir,
+			NodeHostDir:         dir,
+			RTTMillisecond:      getRTTMillisecond(fs, dir),
+			RaftAddress:         addr,
+			SystemEventListener: &testSysEventListener{},
+			Expert:              getTestExpertConfig(fs),
+		}
+		nhc.Expert.TransportMultiplexing = true
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			t.Fatalf("failed to create nodehost %v", err)
+		}
+		nhs = append(nhs, nh)
 	}
-	msgs := node.mq.Get()
-	if len(msgs) != 1 {
-		t.Fatalf("no msg")
+	startReplica := func(replicaID uint64, join bool) {
+		rc := config.Config{
+			ShardID:            1,
+			ReplicaID:          replicaID,
+			ElectionRTT:        10,
+			HeartbeatRTT:       1,
+			CheckQuorum:        true,
+			SnapshotEntries:    20,
+			CompactionOverhead: 5,
+		}
+		peers := make(map[uint64]string)
+		if !join {
+			peers[replicaID] = addrs[replicaID-1]
+		}
+		newSM := func(uint64, uint64) sm.IStateMachine {
+			return &largeSnapshotSM{size: int(settings.SnapshotChunkSize) * 4}
+		}
+		if err := nhs[replicaID-1].StartReplica(peers,
+			join, newSM, rc); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
 	}
-	if msgs[0].Type != pb.SnapshotStatus || !msgs[0].Reject {
-		t.Fatalf("unexpected message")
+	addReplica := func(replicaID uint64) {
+		var lastErr error
+		for i := 0; i < 20; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[0]))
+			lastErr = nhs[0].SyncRequestAddReplica(ctx,
+				1, replicaID, addrs[replicaID-1], 0)
+			cancel()
+			if lastErr == nil {
+				startReplica(replicaID, true)
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("failed to add replica %d, %v", replicaID, lastErr)
 	}
-}
-
-func TestSnapshotReceivedMessageCanBeConverted(t *testing.T) {
-	defer leaktest.AfterTest(t)()
-	nh := &NodeHost{stopper: syncutil.NewStopper()}
-	engine := newExecEngine(nh, config.GetDefaultEngineConfig(), false, false, nil, nil)
-	defer func() {
-		if err := engine.close(); err != nil {
-			t.Fatalf("failed to close engine %v", err)
+	startReplica(1, false)
+	waitForLeaderToBeElected(t, nhs[0], 1)
+	makeProposals := func(count int) {
+		session := nhs[0].GetNoOPSession(1)
+		for i := 0; i < count; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[0]))
+			_, err := nhs[0].SyncPropose(ctx, session, make([]byte, 1024))
+			cancel()
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+			}
 		}
-	}()
-	nh.engine = engine
-	nh.events.sys = newSysEventListener(nil, nh.stopper.ShouldStop())
-	h := messageHandler{nh: nh}
-	mq := server.NewMessageQueue(1024, false, lazyFreeCycle, 1024)
-	node := &node{shardID: 1, replicaID: 1, mq: mq}
-	h.nh.mu.shards.Store(uint64(1), node)
-	mb := pb.MessageBatch{
-		Requests: []pb.Message{{To: 1, From: 2, ShardID: 1, Type: pb.SnapshotReceived}},
 	}
-	sc, mc := h.HandleMessageBatch(mb)
-	if sc != 0 || mc != 1 {
-		t.Errorf("failed to handle message batch")
+	makeProposals(50)
+	addReplica(2)
+	waitForLeaderToBeElected(t, nhs[1], 1)
+	makeProposals(50)
+	leaderID, term, ok, err := nhs[0].GetLeaderID(1)
+	if err != nil || !ok || leaderID != 1 {
+		t.Fatalf("failed to get leader, %d, %t, %v", leaderID, ok, err)
 	}
-	for i := uint64(0); i <= streamConfirmedDelayTick; i++ {
-		node.mq.Tick()
+	// keep appending entries while replica 3 is receiving the snapshot
+	stopper := syncutil.NewStopper()
+	for i := 0; i < 4; i++ {
+		stopper.RunWorker(func() {
+			session := nhs[0].GetNoOPSession(1)
+			for {
+				select {
+				case <-stopper.ShouldStop():
+					return
+				default:
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[0]))
+				_, _ = nhs[0].SyncPropose(ctx, session, make([]byte, 16*1024))
+				cancel()
+			}
+		})
 	}
-	msgs := node.mq.Get()
-	if len(msgs) != 1 {
-		t.Fatalf("no msg")
+	addReplica(3)
+	listener := nhs[2].events.sys.ul.(*testSysEventListener)
+	for i := 0; i < 1000; i++ {
+		if len(listener.getSnapshotReceived()) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
-	if msgs[0].Type != pb.SnapshotStatus || msgs[0].Reject {
-		t.Fatalf("unexpected message")
+	waitForLeaderToBeElected(t, nhs[2], 1)
+	stopper.Stop()
+	if len(listener.getSnapshotReceived()) == 0 {
+		t.Fatalf("snapshot not received")
+	}
+	for idx, nh := range nhs {
+		l, tm, ok, err := nh.GetLeaderID(1)
+		if err != nil || !ok {
+			t.Fatalf("%d, failed to get leader, %v", idx, err)
+		}
+		if l != leaderID || tm != term {
+			t.Errorf("%d, election triggered, leader %d, term %d, want %d, %d",
+				idx, l, tm, leaderID, term)
+		}
 	}
 }
 
-func TestIncorrectlyRoutedMessagesAreIgnored(t *testing.T) {
-	defer leaktest.AfterTest(t)()
-	nh := &NodeHost{stopper: syncutil.NewStopper()}
-	engine := newExecEngine(nh, config.GetDefaultEngineConfig(), false, false, nil, nil)
-	defer func() {
-		if err := engine.close(); err != nil {
-			t.Fatalf("failed to close engine %v", err)
+func TestElectionStatsAreUpdatedByLeaderTransfer(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		var nhs []*NodeHost
+		for replicaID := uint64(1); replicaID <= 3; replicaID++ {
+			rc := config.Config{
+				ShardID:      1,
+				ReplicaID:    replicaID,
+				ElectionRTT:  10,
+				HeartbeatRTT: 1,
+				CheckQuorum:  true,
+			}
+			nh := startThreeReplicaTestShard(t, fs, rc, nil)
+			defer nh.Close()
+			nhs = append(nhs, nh)
+		}
+		if _, err := nhs[0].GetElectionStats(2); err != ErrShardNotFound {
+			t.Fatalf("unexpected error %v", err)
+		}
+		waitForLeaderToBeElected(t, nhs[0], 1)
+		leaderID, _, _, err := nhs[0].GetLeaderID(1)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		target := leaderID%3 + 1
+		before, err := nhs[target-1].GetElectionStats(1)
+		if err != nil {
+			t.Fatalf("failed to get election stats %v", err)
+		}
+		if err := nhs[0].RequestLeaderTransfer(1, target); err != nil {
+			t.Fatalf("failed to request leader transfer %v", err)
+		}
+		for _, nh := range nhs {
+			waitForLeaderID(t, nh, target)
+		}
+		after, err := nhs[target-1].GetElectionStats(1)
+		if err != nil {
+			t.Fatalf("failed to get election stats %v", err)
+		}
+		if after.ShardID != 1 || after.ReplicaID != target ||
+			after.ElectionsStarted != before.ElectionsStarted+1 ||
+			after.ElectionsWon != before.ElectionsWon+1 ||
+			after.ElectionsLost != before.ElectionsLost {
+			t.Errorf("unexpected stats, before %+v, after %+v", before, after)
+		}
+		// heartbeats are sent by the new leader on each tick
+		for i := 0; i < 200; i++ {
+			if after, err = nhs[target-1].GetElectionStats(1); err != nil {
+				t.Fatalf("failed to get election stats %v", err)
+			}
+			if len(after.Peers) == 2 &&
+				after.Peers[0].Samples > 0 && after.Peers[1].Samples > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(after.Peers) != 2 || after.Peers[0].Samples == 0 ||
+			after.Peers[1].Samples == 0 || after.HeartbeatRTTP99 == 0 {
+			t.Errorf("unexpected heartbeat stats %+v", after)
 		}
-	}()
-	nh.engine = engine
-	nh.events.sys = newSysEventListener(nil, nh.stopper.ShouldStop())
-	h := messageHandler{nh: nh}
-	mq := server.NewMessageQueue(1024, false, lazyFreeCycle, 1024)
-	node := &node{shardID: 1, replicaID: 1, mq: mq}
-	h.nh.mu.shards.Store(uint64(1), node)
-	mb := pb.MessageBatch{
-		Requests: []pb.Message{{To: 3, From: 2, ShardID: 1, Type: pb.SnapshotReceived}},
 	}
-	sc, mc := h.HandleMessageBatch(mb)
-	if sc != 0 || mc != 0 {
-		t.Errorf("failed to ignore the message")
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
+func TestRequestTimeoutIsReportedAfterConfiguredTicks(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		var nhs []*NodeHost
+		for replicaID := uint64(1); replicaID <= 3; replicaID++ {
+			rc := config.Config{
+				ShardID:      1,
+				ReplicaID:    replicaID,
+				ElectionRTT:  10,
+				HeartbeatRTT: 1,
+			}
+			nhs = append(nhs, startThreeReplicaTestShard(t, fs, rc, nil))
+		}
+		closed := make(map[int]bool)
+		defer func() {
+			for idx, nh := range nhs {
+				if !closed[idx] {
+					nh.Close()
+				}
+			}
+		}()
+		waitForLeaderToBeElected(t, nhs[0], 1)
+		leaderID, _, _, err := nhs[0].GetLeaderID(1)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		leader := nhs[leaderID-1]
+		// entries can no longer be committed once the followers are gone
+		for idx := range nhs {
+			if uint64(idx+1) != leaderID {
+				nhs[idx].Close()
+				closed[idx] = true
+			}
+		}
+		rtt := time.Duration(leader.NodeHostConfig().RTTMillisecond) * time.Millisecond
+		timeout := 20 * rtt
+		start := time.Now()
+		rs, err := leader.Propose(leader.GetNoOPSession(1), []byte("test"), timeout)
+		if err != nil {
+			t.Fatalf("failed to make proposal %v", err)
+		}
+		v := <-rs.ResultC()
+		elapsed := time.Since(start)
+		rs.Release()
+		if !v.Timeout() {
+			t.Fatalf("unexpected result %v", v)
+		}
+		// timeouts are checked at tick granularity
+		if elapsed < timeout-2*rtt || elapsed > timeout+20*rtt {
+			t.Errorf("timed out after %v, timeout %v", elapsed, timeout)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if _, err := leader.SyncPropose(ctx,
+			leader.GetNoOPSession(1), []byte("test")); err != ErrTimeout {
+			t.Errorf("unexpected error %v", err)
+		}
 	}
-	msgs := node.mq.Get()
-	if len(msgs) != 0 {
-		t.Fatalf("received unexpected message")
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
+func TestSuggestElectionRTT(t *testing.T) {
+	tests := []struct {
+		p99            time.Duration
+		rttMillisecond uint64
+		suggested      uint64
+	}{
+		{0, 100, 10},
+		{time.Millisecond, 0, 10},
+		{50 * time.Millisecond, 100, 10},
+		{250 * time.Millisecond, 100, 25},
+		{251 * time.Millisecond, 100, 26},
+		{time.Second, 5, 2000},
+	}
+	for idx, tt := range tests {
+		if v := SuggestElectionRTT(tt.p99, tt.rttMillisecond); v != tt.suggested {
+			t.Errorf("%d, suggested %d, want %d", idx, v, tt.suggested)
+		}
 	}
 }
 
-func TestProposeOnClosedNode(t *testing.T) {
+type requestIDRecordingSM struct {
+	tests.NoOP
+	mu      sync.Mutex
+	indexes map[string]uint64
+}
+
+func (s *requestIDRecordingSM) Update(e sm.Entry) (sm.Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(e.RequestID) > 0 {
+		s.indexes[string(e.RequestID)] = e.Index
+	}
+	return sm.Result{}, nil
+}
+
+func (s *requestIDRecordingSM) getIndex(requestID []byte) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	index, ok := s.indexes[string(requestID)]
+	return index, ok
+}
+
+func TestRequestIDIsObservedByAllReplicas(t *testing.T) {
 	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			u, err := nh.GetNodeUser(1)
+	tf := func() {
+		peers := getThreeReplicaTestPeers()
+		var nhs []*NodeHost
+		var sms []*requestIDRecordingSM
+		for replicaID := uint64(1); replicaID <= 3; replicaID++ {
+			dir := fs.PathJoin(singleNodeHostTestDir, fmt.Sprintf("nh%d", replicaID))
+			nhc := config.NodeHostConfig{
+				NodeHostDir:    dir,
+				RTTMillisecond: getRTTMillisecond(fs, dir),
+				RaftAddress:    peers[replicaID],
+				Expert:         getTestExpertConfig(fs),
+			}
+			nh, err := NewNodeHost(nhc)
 			if err != nil {
-				t.Fatalf("failed to get node, %v", err)
+				t.Fatalf("failed to create node host %v", err)
 			}
-			if err := nh.StopReplica(1, 1); err != nil {
-				t.Fatalf("failed to stop node, %v", err)
+			defer nh.Close()
+			nhs = append(nhs, nh)
+			s := &requestIDRecordingSM{indexes: make(map[string]uint64)}
+			sms = append(sms, s)
+			rc := config.Config{
+				ShardID:             1,
+				ReplicaID:           replicaID,
+				ElectionRTT:         10,
+				HeartbeatRTT:        1,
+				PropagateRequestIDs: replicaID == 1,
+			}
+			newSM := func(uint64, uint64) sm.IStateMachine { return s }
+			if err := nh.StartReplica(peers, false, newSM, rc); err != nil {
+				t.Fatalf("failed to start shard %v", err)
 			}
-			cs := nh.GetNoOPSession(1)
-			if _, err := u.Propose(cs, nil, time.Second); err == nil {
-				t.Errorf("propose on closed node didn't cause error")
-			} else {
-				plog.Infof("%v returned from closed node", err)
+		}
+		waitForLeaderToBeElected(t, nhs[0], 1)
+		id := [RequestIDLength]byte{'r', 'e', 'q', 'u', 'e', 's', 't', '-', 'i', 'd'}
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[0]))
+		defer cancel()
+		ctx = WithRequestID(ctx, id)
+		session := nhs[0].GetNoOPSession(1)
+		if _, err := nhs[0].SyncPropose(ctx, session, []byte("test-data")); err != nil {
+			t.Fatalf("failed to make proposal, %v", err)
+		}
+		index, ok := sms[0].getIndex(id[:])
+		if !ok {
+			t.Fatalf("request ID not observed by the proposing replica")
+		}
+		for i := 0; i < 500; i++ {
+			if _, ok = sms[2].getIndex(id[:]); ok {
+				break
 			}
-		},
+			time.Sleep(10 * time.Millisecond)
+		}
+		if other, ok := sms[2].getIndex(id[:]); !ok || other != index {
+			t.Errorf("request ID observed at index %d, %t, want %d", other, ok, index)
+		}
 	}
-	runNodeHostTest(t, to, fs)
+	runNodeHostTestDC(t, tf, true, fs)
 }
 
-func TestReadIndexOnClosedNode(t *testing.T) {
+// advanceUntil advances the clock one RTT at a time until cond returns true.
+func advanceUntil(t *testing.T,
+	nh *NodeHost, clock *clocktest.Clock, cond func() bool) {
+	t.Helper()
+	rtt := time.Duration(nh.NodeHostConfig().RTTMillisecond) * time.Millisecond
+	for i := 0; i < 1000; i++ {
+		if cond() {
+			return
+		}
+		clock.Advance(rtt)
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("condition not met after 1000 RTTs")
+}
+
+func advanceUntilLeaderElected(t *testing.T,
+	nh *NodeHost, clock *clocktest.Clock, shardID uint64) {
+	t.Helper()
+	advanceUntil(t, nh, clock, func() bool {
+		_, _, ready, err := nh.GetLeaderID(shardID)
+		return err == nil && ready
+	})
+}
+
+func TestSnapshotIsTakenWhenSnapshotIntervalElapsed(t *testing.T) {
 	fs := vfs.GetTestFS()
+	clock := clocktest.NewClock(time.Now())
 	to := &testOption{
-		defaultTestNode: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.Expert.Clock = clock
+			return c
+		},
+		noElection: true,
 		tf: func(nh *NodeHost) {
-			u, err := nh.GetNodeUser(1)
-			if err != nil {
-				t.Fatalf("failed to get node, %v", err)
+			rc := getTestConfig()
+			rc.SnapshotIntervalSeconds = 3600
+			newNoOP := func(uint64, uint64) sm.IStateMachine { return &tests.NoOP{} }
+			peers := map[uint64]string{1: nh.RaftAddress()}
+			if err := nh.StartReplica(peers, false, newNoOP, *rc); err != nil {
+				t.Fatalf("failed to start replica %v", err)
+			}
+			advanceUntilLeaderElected(t, nh, clock, 1)
+			getSnapshot := func() pb.Snapshot {
+				ss, err := nh.mu.logdb.GetSnapshot(1, 1)
+				if err != nil {
+					t.Fatalf("failed to get snapshot %v", err)
+				}
+				return ss
 			}
-			if err := nh.StopReplica(1, 1); err != nil {
-				t.Fatalf("failed to stop node, %v", err)
+			waitForSnapshot := func(index uint64) pb.Snapshot {
+				for i := 0; i < 500; i++ {
+					if ss := getSnapshot(); ss.Index > index {
+						return ss
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				t.Fatalf("no snapshot taken after %d", index)
+				return pb.Snapshot{}
 			}
-			if _, err := u.ReadIndex(time.Second); err == nil {
-				t.Errorf("ReadIndex on closed node didn't cause error")
-			} else {
-				plog.Infof("%v returned from closed node", err)
+			expectNoSnapshot := func(index uint64) {
+				time.Sleep(100 * time.Millisecond)
+				if ss := getSnapshot(); ss.Index != index {
+					t.Fatalf("unexpected snapshot at %d, want %d", ss.Index, index)
+				}
+			}
+			proposeTestData(t, nh, "trickle", 1)
+			clock.Jump(30 * time.Minute)
+			expectNoSnapshot(0)
+			clock.Jump(31 * time.Minute)
+			ss := waitForSnapshot(0)
+			if ss.CreatedAt != clock.Now().UnixNano() {
+				t.Errorf("unexpected creation time %d", ss.CreatedAt)
+			}
+			// no new entry since the last snapshot
+			clock.Jump(2 * time.Hour)
+			expectNoSnapshot(ss.Index)
+			proposeTestData(t, nh, "trickle", 1)
+			clock.Jump(time.Minute)
+			ss = waitForSnapshot(ss.Index)
+			// the last snapshot time is restored after restart
+			clock.Jump(40 * time.Minute)
+			if err := nh.StopShard(1); err != nil {
+				t.Fatalf("failed to stop shard %v", err)
+			}
+			for i := 0; i < 1000; i++ {
+				err := nh.StartReplica(nil, false, newNoOP, *rc)
+				if err == nil {
+					break
+				}
+				if !errors.Is(err, ErrShardAlreadyExist) {
+					t.Fatalf("failed to restart replica %v", err)
+				}
+				time.Sleep(5 * time.Millisecond)
 			}
+			advanceUntilLeaderElected(t, nh, clock, 1)
+			proposeTestData(t, nh, "trickle", 1)
+			clock.Jump(21 * time.Minute)
+			waitForSnapshot(ss.Index)
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-func TestNodeCanNotStartWhenStillLoadedInEngine(t *testing.T) {
-	fs := vfs.GetTestFS()
-	to := &testOption{
-		defaultTestNode: true,
-		tf: func(nh *NodeHost) {
-			nodes := make(map[uint64]*node)
-			nodes[2] = &node{shardID: 2, replicaID: 1}
-			nh.engine.loaded.update(1, fromStepWorker, nodes)
-			if err := nh.startShard(nil, false, nil,
-				config.Config{ShardID: 2, ReplicaID: 1},
-				pb.RegularStateMachine); err != ErrShardAlreadyExist {
-				t.Errorf("failed to return ErrShardAlreadyExist, %v", err)
-			}
-		},
+// concurrencyTrackingSM is a state machine that tracks the number of snapshots
+// concurrently saved by all its instances.
+type concurrencyTrackingSM struct {
+	tests.NoOP
+	active *int64
+	max    *int64
+	saved  *int64
+}
+
+func (s *concurrencyTrackingSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	active := atomic.AddInt64(s.active, 1)
+	defer atomic.AddInt64(s.active, -1)
+	for {
+		max := atomic.LoadInt64(s.max)
+		if active <= max || atomic.CompareAndSwapInt64(s.max, max, active) {
+			break
+		}
 	}
-	runNodeHostTest(t, to, fs)
+	time.Sleep(20 * time.Millisecond)
+	atomic.AddInt64(s.saved, 1)
+	return s.NoOP.SaveSnapshot(w, fc, done)
 }
 
-func TestBootstrapInfoIsValidated(t *testing.T) {
+func TestConcurrentSnapshotsAreLimited(t *testing.T) {
 	fs := vfs.GetTestFS()
+	shardCount := uint64(20)
+	var active, max, saved int64
 	to := &testOption{
-		defaultTestNode: true,
+		noElection: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.Expert.MaxConcurrentSnapshots = 2
+			return c
+		},
 		tf: func(nh *NodeHost) {
-			if _, _, err := nh.bootstrapShard(nil, false,
-				config.Config{ShardID: 1, ReplicaID: 1},
-				pb.OnDiskStateMachine); err != ErrInvalidShardSettings {
-				t.Errorf("failed to fail the boostrap, %v", err)
+			newSM := func(uint64, uint64) sm.IStateMachine {
+				return &concurrencyTrackingSM{
+					active: &active,
+					max:    &max,
+					saved:  &saved,
+				}
+			}
+			for shardID := uint64(1); shardID <= shardCount; shardID++ {
+				rc := getTestConfig()
+				rc.ShardID = shardID
+				rc.SnapshotEntries = 5
+				peers := map[uint64]string{1: nh.RaftAddress()}
+				if err := nh.StartReplica(peers, false, newSM, *rc); err != nil {
+					t.Fatalf("failed to start shard %v", err)
+				}
+			}
+			var wg sync.WaitGroup
+			for shardID := uint64(1); shardID <= shardCount; shardID++ {
+				waitForLeaderToBeElected(t, nh, shardID)
+				wg.Add(1)
+				go func(shardID uint64) {
+					defer wg.Done()
+					session := nh.GetNoOPSession(shardID)
+					for i := 0; i < 12; i++ {
+						ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+						_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
+						cancel()
+						if err != nil {
+							t.Errorf("failed to make proposal %v", err)
+							return
+						}
+					}
+				}(shardID)
+			}
+			wg.Wait()
+			for i := 0; i < 500; i++ {
+				if atomic.LoadInt64(&saved) >= int64(shardCount) &&
+					atomic.LoadInt64(&active) == 0 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if v := atomic.LoadInt64(&saved); v < int64(shardCount) {
+				t.Fatalf("only %d snapshots saved", v)
+			}
+			if v := atomic.LoadInt64(&max); v > 2 {
+				t.Errorf("%d snapshots saved concurrently, limit 2", v)
+			}
+			for shardID := uint64(1); shardID <= shardCount; shardID++ {
+				r, err := nh.ExplainCompaction(shardID)
+				if err != nil {
+					t.Fatalf("failed to explain compaction %v", err)
+				}
+				if r.SnapshotQueuePosition != 0 {
+					t.Errorf("shard %d still queued, %+v", shardID, r)
+				}
 			}
 		},
 	}
 	runNodeHostTest(t, to, fs)
 }
 
-// slow tests
-
-type stressRSM struct{}
-
-func (s *stressRSM) Update(sm.Entry) (sm.Result, error) {
-	plog.Infof("updated")
-	return sm.Result{}, nil
-}
-
-func (s *stressRSM) Lookup(interface{}) (interface{}, error) {
-	return nil, nil
+// commitTestSM is a cloneTestSM that doesn't apply any entry until released.
+type commitTestSM struct {
+	cloneTestSM
+	releasedC chan struct{}
 }
 
-func (s *stressRSM) SaveSnapshot(w io.Writer,
-	f sm.ISnapshotFileCollection, c <-chan struct{}) error {
-	data := make([]byte, settings.SnapshotChunkSize*3)
-	_, err := w.Write(data)
-	return err
+func (s *commitTestSM) Update(e sm.Entry) (sm.Result, error) {
+	<-s.releasedC
+	return s.cloneTestSM.Update(e)
 }
 
-func (s *stressRSM) RecoverFromSnapshot(r io.Reader,
-	f []sm.SnapshotFile, c <-chan struct{}) error {
-	plog.Infof("RecoverFromSnapshot called")
-	data := make([]byte, settings.SnapshotChunkSize*3)
-	n, err := io.ReadFull(r, data)
-	if uint64(n) != settings.SnapshotChunkSize*3 {
-		return errors.New("unexpected size")
+func TestSyncProposeCommittedReturnsBeforeApply(t *testing.T) {
+	fs := vfs.GetTestFS()
+	releasedC := make(chan struct{})
+	to := &testOption{
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &commitTestSM{
+				cloneTestSM: cloneTestSM{kv: make(map[string]string)},
+				releasedC:   releasedC,
+			}
+		},
+		tf: func(nh *NodeHost) {
+			defer func() {
+				select {
+				case <-releasedC:
+				default:
+					close(releasedC)
+				}
+			}()
+			n, ok := nh.getShard(1)
+			if !ok {
+				t.Fatalf("failed to get node")
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			m, err := nh.SyncProposeCommitted(ctx,
+				nh.GetNoOPSession(1), []byte("k=1"))
+			if err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+			_, term, _, err := nh.GetLeaderID(1)
+			if err != nil {
+				t.Fatalf("failed to get leader id %v", err)
+			}
+			if m.Index == 0 || m.Term != term {
+				t.Errorf("unexpected entry meta %+v, term %d", m, term)
+			}
+			if applied := n.sm.GetLastApplied(); applied >= m.Index {
+				t.Errorf("entry %d applied before released, applied %d",
+					m.Index, applied)
+			}
+			close(releasedC)
+			if v := readCloneTestValue(t, nh, 1, "k"); v != "1" {
+				t.Errorf("unexpected value %s", v)
+			}
+			if applied := n.sm.GetLastApplied(); applied < m.Index {
+				t.Errorf("entry %d not applied, applied %d", m.Index, applied)
+			}
+			// proposals made with registered client sessions are only notified
+			// once applied, rejections are returned instead
+			cs := client.NewSession(1, random.LockGuardedRand)
+			cs.PrepareForPropose()
+			if _, err := nh.SyncProposeCommitted(ctx,
+				cs, []byte("k=2")); !errors.Is(err, ErrRejected) {
+				t.Errorf("unexpected error %v", err)
+			}
+			cs, err = nh.SyncGetSession(ctx, 1)
+			if err != nil {
+				t.Fatalf("failed to get session %v", err)
+			}
+			m, err = nh.SyncProposeCommitted(ctx, cs, []byte("k=3"))
+			if err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+			cs.ProposalCompleted()
+			if applied := n.sm.GetLastApplied(); applied < m.Index {
+				t.Errorf("entry %d not applied, applied %d", m.Index, applied)
+			}
+			if v := readCloneTestValue(t, nh, 1, "k"); v != "3" {
+				t.Errorf("unexpected value %s", v)
+			}
+		},
 	}
-	return err
-}
-
-func (s *stressRSM) Close() error {
-	return nil
+	runNodeHostTest(t, to, fs)
 }
 
-// this test takes around 6 minutes on mbp and 30 seconds on a linux box with
-// proper SSD
-func TestSlowTestStressedSnapshotWorker(t *testing.T) {
-	if len(os.Getenv("SLOW_TEST")) == 0 {
-		t.Skip("skipped TestSlowTestStressedSnapshotWorker, SLOW_TEST not set")
-	}
+func TestCommittedProposalIsCompletedAfterLeaderChange(t *testing.T) {
 	fs := vfs.GetTestFS()
-	if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
-		t.Fatalf("%v", err)
+	releasedC := make([]chan struct{}, 3)
+	for i := range releasedC {
+		releasedC[i] = make(chan struct{})
 	}
-	defer func() {
-		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
-			t.Fatalf("%v", err)
+	release := func(replicaID uint64) {
+		select {
+		case <-releasedC[replicaID-1]:
+		default:
+			close(releasedC[replicaID-1])
 		}
-	}()
-	nh1dir := fs.PathJoin(singleNodeHostTestDir, "nh1")
-	nh2dir := fs.PathJoin(singleNodeHostTestDir, "nh2")
-	rc := config.Config{
-		ShardID:            1,
-		ReplicaID:          1,
-		ElectionRTT:        10,
-		HeartbeatRTT:       1,
-		CheckQuorum:        true,
-		SnapshotEntries:    5,
-		CompactionOverhead: 1,
-	}
-	peers := make(map[uint64]string)
-	peers[1] = nodeHostTestAddr1
-	nhc1 := config.NodeHostConfig{
-		WALDir:         nh1dir,
-		NodeHostDir:    nh1dir,
-		RTTMillisecond: 5 * getRTTMillisecond(fs, nh1dir),
-		RaftAddress:    nodeHostTestAddr1,
-		Expert:         getTestExpertConfig(fs),
-	}
-	nh1, err := NewNodeHost(nhc1)
-	if err != nil {
-		t.Fatalf("failed to create node host %v", err)
-	}
-	defer nh1.Close()
-	newRSM := func(uint64, uint64) sm.IStateMachine {
-		return &stressRSM{}
 	}
-	for i := uint64(1); i <= uint64(96); i++ {
-		rc.ShardID = i
-		if err := nh1.StartReplica(peers, false, newRSM, rc); err != nil {
-			t.Fatalf("failed to start shard %v", err)
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		defer func() {
+			for i := range releasedC {
+				release(uint64(i + 1))
+			}
+		}()
+		peers := make(map[uint64]string)
+		for i := range nhs {
+			peers[uint64(i+1)] = memtransport.Address(i + 1)
 		}
-		cs := nh1.GetNoOPSession(i)
-		total := 20
-		for {
-			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-			_, err := nh1.SyncPropose(ctx, cs, make([]byte, 1))
-			cancel()
-			if err == ErrTimeout || err == ErrShardNotReady {
-				time.Sleep(100 * time.Millisecond)
-				continue
+		createSM := func(shardID uint64, replicaID uint64) sm.IStateMachine {
+			return &commitTestSM{
+				cloneTestSM: cloneTestSM{kv: make(map[string]string)},
+				releasedC:   releasedC[replicaID-1],
 			}
-			total--
-			if total == 0 {
-				break
+		}
+		for i, nh := range nhs {
+			rc := getBootstrapTestConfig(uint64(i + 1))
+			rc.ShardID = 1
+			if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+				t.Fatalf("failed to start replica %v", err)
 			}
 		}
-	}
-	// add another node
-	for i := uint64(1); i <= uint64(96); i++ {
-		for {
-			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-			err := nh1.SyncRequestAddReplica(ctx, i, 2, nodeHostTestAddr2, 0)
-			cancel()
-			if err != nil {
-				if err == ErrTimeout || err == ErrShardNotReady {
-					time.Sleep(100 * time.Millisecond)
-					continue
-				} else {
-					t.Fatalf("failed to add node %v", err)
-				}
-			} else {
-				break
+		for _, nh := range nhs {
+			waitForLeaderToBeElected(t, nh, 1)
+		}
+		leaderID, _, _, err := nhs[0].GetLeaderID(1)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		// only the leader is slow to apply entries
+		for i := range nhs {
+			if uint64(i+1) != leaderID {
+				release(uint64(i + 1))
 			}
 		}
-	}
-	plog.Infof("all nodes added")
-	nhc2 := config.NodeHostConfig{
-		WALDir:         nh2dir,
-		NodeHostDir:    nh2dir,
-		RTTMillisecond: 5 * getRTTMillisecond(fs, nh2dir),
-		RaftAddress:    nodeHostTestAddr2,
-		Expert:         getTestExpertConfig(fs),
-	}
-	nh2, err := NewNodeHost(nhc2)
-	if err != nil {
-		t.Fatalf("failed to create node host 2 %v", err)
-	}
-	// start new nodes
-	defer nh2.Close()
-	for i := uint64(1); i <= uint64(96); i++ {
-		rc.ShardID = i
-		rc.ReplicaID = 2
-		peers := make(map[uint64]string)
-		if err := nh2.StartReplica(peers, true, newRSM, rc); err != nil {
-			t.Fatalf("failed to start shard %v", err)
+		leader := nhs[leaderID-1]
+		rs, err := leader.Propose(leader.GetNoOPSession(1),
+			[]byte("k=1"), lpto(leader))
+		if err != nil {
+			t.Fatalf("failed to make proposal %v", err)
 		}
-	}
-	for i := uint64(1); i <= uint64(96); i++ {
-		cs := nh2.GetNoOPSession(i)
-		total := 1000
+		var m EntryMeta
+		select {
+		case m = <-rs.CommittedC():
+		case <-time.After(lpto(leader)):
+			t.Fatalf("committed notification not delivered")
+		}
+		// the leader changes after the committed notification
+		target := leaderID%uint64(len(nhs)) + 1
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(leader))
+		defer cancel()
+		if err := nhs[target-1].SyncRequestLeaderTransfer(ctx,
+			1, target, LeaderTransferOption{}); err != nil {
+			t.Fatalf("failed to transfer leadership %v", err)
+		}
+		_, term, _, err := nhs[target-1].GetLeaderID(1)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		if term <= m.Term {
+			t.Fatalf("term %d not changed from %d", term, m.Term)
+		}
+		// the new leader drops reads until its no-op entry is committed
+		var rv interface{}
 		for {
-			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-			_, err := nh2.SyncPropose(ctx, cs, make([]byte, 1))
-			cancel()
-			if err != nil {
-				if err == ErrTimeout || err == ErrShardNotReady {
-					total--
-					if total == 0 {
-						t.Fatalf("failed to make proposal on shard %d", i)
-					}
-					time.Sleep(100 * time.Millisecond)
-					continue
-				} else {
-					t.Fatalf("failed to make proposal %v", err)
-				}
-			} else {
+			rctx, rcancel := context.WithTimeout(ctx, pto(nhs[target-1]))
+			rv, err = nhs[target-1].SyncRead(rctx, 1, "k")
+			rcancel()
+			if err == nil {
 				break
 			}
+			if !errors.Is(err, ErrShardNotReady) || ctx.Err() != nil {
+				t.Fatalf("failed to read %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if v := rv.(string); v != "1" {
+			t.Errorf("unexpected value %s", v)
+		}
+		if len(rs.AppliedC()) != 0 {
+			t.Fatalf("completed before applied")
+		}
+		release(leaderID)
+		v := <-rs.AppliedC()
+		if !v.Completed() {
+			t.Fatalf("committed proposal not completed, %v", v)
 		}
+		rs.Release()
 	}
+	memTransportNodeHostTest(t, 3, tf, fs)
 }
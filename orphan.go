@@ -0,0 +1,428 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+var (
+	// ErrPurgeNotConfirmed indicates that the confirm token provided to
+	// PurgeOrphanedData is not the NodeHostID of the NodeHost.
+	ErrPurgeNotConfirmed = errors.New("purge not confirmed")
+)
+
+// OrphanType is the type of orphaned data found by FindOrphanedData.
+type OrphanType int
+
+const (
+	// OrphanRemovedReplica is the data of a replica that is not running on the
+	// NodeHost and has been removed from its shard, i.e. RemoveData was never
+	// invoked. Both its LogDB records and its snapshot directory are orphaned.
+	OrphanRemovedReplica OrphanType = iota
+	// OrphanSnapshotDir is a snapshot directory without any LogDB record, it is
+	// left behind when RemoveData is interrupted after removing LogDB records.
+	OrphanSnapshotDir
+	// OrphanRemovedSnapshots are snapshots found in a snapshot directory that
+	// has already been marked as removed, they are left behind when RemoveData
+	// is interrupted before all snapshots are deleted.
+	OrphanRemovedSnapshots
+)
+
+var orphanTypeNames = [...]string{
+	OrphanRemovedReplica:   "RemovedReplica",
+	OrphanSnapshotDir:      "SnapshotDir",
+	OrphanRemovedSnapshots: "RemovedSnapshots",
+}
+
+func (t OrphanType) String() string {
+	if t < OrphanRemovedReplica || t > OrphanRemovedSnapshots {
+		return fmt.Sprintf("OrphanType(%d)", int(t))
+	}
+	return orphanTypeNames[t]
+}
+
+// OrphanReport describes orphaned data of a replica found by
+// FindOrphanedData.
+type OrphanReport struct {
+	// Type is the type of the orphaned data.
+	Type OrphanType
+	// ShardID and ReplicaID identify the replica owning the orphaned data.
+	ShardID   uint64
+	ReplicaID uint64
+	// Reason describes why the data is considered as orphaned.
+	Reason string
+	// Path is the snapshot directory of the replica, it is empty when the
+	// replica has no snapshot directory.
+	Path string
+	// Size is the size of the snapshot directory in bytes, space used by LogDB
+	// records is not included.
+	Size uint64
+	// ModTime is the last modification time of files in the snapshot
+	// directory, it is zero when the replica has no snapshot directory.
+	ModTime time.Time
+	// Registry indicates that the replica is classified as removed based on
+	// the membership known to the NodeHostRegistry.
+	Registry bool
+}
+
+func (r OrphanReport) String() string {
+	return fmt.Sprintf("%s %s, %s, %d bytes, %s",
+		r.Type, dn(r.ShardID, r.ReplicaID), r.Reason, r.Size, r.Path)
+}
+
+// OrphanOption is the option type used by FindOrphanedData.
+type OrphanOption struct {
+	// UseRegistry indicates that replicas considered as members by their own
+	// Raft logs should also be checked against the shard membership known to
+	// the NodeHostRegistry. Such replicas are classified as removed when the
+	// registry has a more recent membership of the shard that doesn't include
+	// them. UseRegistry is ignored when the NodeHostRegistry is not enabled.
+	UseRegistry bool
+}
+
+// FindOrphanedData returns data of replicas that are no longer needed but are
+// still found in the NodeHost directories, e.g. data of replicas removed from
+// their shards without RemoveData being invoked, or data left behind by
+// RemoveData interrupted by crashes. LogDB records and snapshot directories
+// of replicas not running on the NodeHost are cross-referenced, a replica with
+// LogDB records is only classified as removed when its removal has been
+// committed in its own Raft log, or in the membership known to the
+// NodeHostRegistry when opt.UseRegistry is set. Replicas running on the
+// NodeHost and stopped replicas that are still members of their shards are
+// never reported. Data of on disk state machines is managed by applications
+// and is not checked.
+//
+// Reports are returned in ascending shard ID and replica ID order, they can be
+// passed to PurgeOrphanedData once reviewed.
+func (nh *NodeHost) FindOrphanedData(ctx context.Context,
+	opt OrphanOption) ([]OrphanReport, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	nodes, err := nh.mu.logdb.ListNodeInfo()
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := nh.env.ListSnapshotDirs(nh.nhConfig.GetDeploymentID())
+	if err != nil {
+		return nil, err
+	}
+	var reports []OrphanReport
+	inLogDB := make(map[raftio.NodeInfo]struct{})
+	for _, ni := range nodes {
+		inLogDB[ni] = struct{}{}
+	}
+	for _, ni := range nodes {
+		if ctx.Err() != nil {
+			return nil, getContextError(ctx)
+		}
+		r, ok, err := nh.findOrphan(ni.ShardID, ni.ReplicaID, opt.UseRegistry)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			reports = append(reports, r)
+		}
+	}
+	for _, d := range dirs {
+		if ctx.Err() != nil {
+			return nil, getContextError(ctx)
+		}
+		ni := raftio.NodeInfo{ShardID: d.ShardID, ReplicaID: d.ReplicaID}
+		if _, ok := inLogDB[ni]; ok {
+			continue
+		}
+		r, ok, err := nh.findOrphan(d.ShardID, d.ReplicaID, opt.UseRegistry)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			reports = append(reports, r)
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].ShardID != reports[j].ShardID {
+			return reports[i].ShardID < reports[j].ShardID
+		}
+		return reports[i].ReplicaID < reports[j].ReplicaID
+	})
+	return reports, nil
+}
+
+// PurgeOrphanedData deletes orphaned data described by reports returned by
+// FindOrphanedData. confirmToken must be the NodeHostID of the NodeHost, it
+// guards against purging data on a NodeHost other than the one that has been
+// checked, ErrPurgeNotConfirmed is returned otherwise.
+//
+// Each report is checked again before its data is deleted, reports that no
+// longer describe orphaned data, e.g. when the replica has been restarted,
+// are skipped. LogDB records of removed replicas are deleted and their
+// snapshot directories are marked as removed in the same way as RemoveData,
+// deleted snapshot directories are synced. An OrphanedDataPurged system event
+// is published each time data of a replica has been purged. The context is
+// checked between reports.
+func (nh *NodeHost) PurgeOrphanedData(ctx context.Context,
+	reports []OrphanReport, confirmToken string) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "PurgeOrphanedData",
+	}, time.Now(), &err)
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	if confirmToken != nh.ID() {
+		return ErrPurgeNotConfirmed
+	}
+	completed := uint64(0)
+	for _, r := range reports {
+		if ctx.Err() != nil {
+			return getContextError(ctx)
+		}
+		purged, err := nh.purgeOrphan(r)
+		if err != nil {
+			return err
+		}
+		if !purged {
+			plog.Warningf("%s is no longer orphaned, skipped", r)
+			continue
+		}
+		completed++
+		plog.Infof("purged %s", r)
+		nh.events.sys.Publish(server.SystemEvent{
+			Type:       server.OrphanedDataPurged,
+			ShardID:    r.ShardID,
+			ReplicaID:  r.ReplicaID,
+			Path:       r.Path,
+			TotalBytes: r.Size,
+			Completed:  completed,
+			Total:      uint64(len(reports)),
+		})
+	}
+	return nil
+}
+
+func (nh *NodeHost) purgeOrphan(r OrphanReport) (bool, error) {
+	current, ok, err := nh.findOrphan(r.ShardID, r.ReplicaID, r.Registry)
+	if err != nil || !ok || current.Type != r.Type {
+		return false, err
+	}
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return false, ErrClosed
+	}
+	if nh.engine.nodeLoaded(r.ShardID, r.ReplicaID) {
+		return false, nil
+	}
+	did := nh.nhConfig.GetDeploymentID()
+	switch r.Type {
+	case OrphanRemovedReplica:
+		if err := nh.mu.logdb.RemoveNodeData(r.ShardID, r.ReplicaID); err != nil {
+			return false, err
+		}
+		return true, nh.env.RemoveSnapshotDir(did, r.ShardID, r.ReplicaID)
+	case OrphanSnapshotDir:
+		return true, nh.env.RemoveSnapshotDir(did, r.ShardID, r.ReplicaID)
+	case OrphanRemovedSnapshots:
+		return true, nh.env.RemoveSavedSnapshots(did, r.ShardID, r.ReplicaID)
+	default:
+		panic("unknown orphan type")
+	}
+}
+
+// findOrphan checks whether data of the specified replica is orphaned.
+func (nh *NodeHost) findOrphan(shardID uint64,
+	replicaID uint64, useRegistry bool) (OrphanReport, bool, error) {
+	if n, ok := nh.getShard(shardID); ok && n.replicaID == replicaID {
+		return OrphanReport{}, false, nil
+	}
+	if nh.engine.nodeLoaded(shardID, replicaID) {
+		return OrphanReport{}, false, nil
+	}
+	r := OrphanReport{ShardID: shardID, ReplicaID: replicaID}
+	did := nh.nhConfig.GetDeploymentID()
+	dir := nh.env.GetSnapshotDir(did, shardID, replicaID)
+	exist, err := fileutil.Exist(dir, nh.fs)
+	if err != nil {
+		return OrphanReport{}, false, err
+	}
+	removed := false
+	if exist {
+		r.Path = dir
+		if removed, err = fileutil.IsDirMarkedAsDeleted(dir, nh.fs); err != nil {
+			return OrphanReport{}, false, err
+		}
+		if r.Size, r.ModTime, err = getDirStats(dir, nh.fs); err != nil {
+			return OrphanReport{}, false, err
+		}
+	}
+	_, err = nh.mu.logdb.GetBootstrapInfo(shardID, replicaID)
+	if errors.Is(err, raftio.ErrNoBootstrapInfo) {
+		if !exist {
+			return OrphanReport{}, false, nil
+		}
+		if !removed {
+			r.Type = OrphanSnapshotDir
+			r.Reason = "snapshot directory without LogDB records"
+			return r, true, nil
+		}
+		has, err := hasSavedSnapshots(dir, nh.fs)
+		if err != nil || !has {
+			return OrphanReport{}, false, err
+		}
+		r.Type = OrphanRemovedSnapshots
+		r.Reason = "snapshots left in removed snapshot directory"
+		return r, true, nil
+	}
+	if err != nil {
+		return OrphanReport{}, false, err
+	}
+	r.Type = OrphanRemovedReplica
+	if removed {
+		r.Reason = "snapshot directory marked as removed"
+		return r, true, nil
+	}
+	m, err := nh.getCommittedMembership(shardID, replicaID)
+	if err != nil {
+		return OrphanReport{}, false, err
+	}
+	if m.IsRemoved(replicaID) {
+		r.Reason = fmt.Sprintf("removed from shard at index %d", m.ConfigChangeId)
+		return r, true, nil
+	}
+	if useRegistry {
+		if reg, ok := nh.GetNodeHostRegistry(); ok {
+			sv, ok := reg.GetShardInfo(shardID)
+			if ok && sv.ConfigChangeIndex > m.ConfigChangeId &&
+				!isShardViewMember(sv, replicaID) {
+				r.Reason = fmt.Sprintf("not a member according to the registry "+
+					"at index %d", sv.ConfigChangeIndex)
+				r.Registry = true
+				return r, true, nil
+			}
+		}
+	}
+	return OrphanReport{}, false, nil
+}
+
+// getCommittedMembership returns the membership of the replica after applying
+// all committed config changes found in its Raft log.
+func (nh *NodeHost) getCommittedMembership(shardID uint64,
+	replicaID uint64) (pb.Membership, error) {
+	ldb := nh.mu.logdb
+	ss, err := ldb.GetSnapshot(shardID, replicaID)
+	if err != nil {
+		return pb.Membership{}, err
+	}
+	rs, err := ldb.ReadRaftState(shardID, replicaID, ss.Index)
+	if errors.Is(err, raftio.ErrNoSavedLog) {
+		return ss.Membership, nil
+	}
+	if err != nil {
+		return pb.Membership{}, err
+	}
+	m := ss.Membership
+	var entries []pb.Entry
+	for low := ss.Index + 1; low <= rs.State.Commit; {
+		entries, _, err = ldb.IterateEntries(entries[:0], 0,
+			shardID, replicaID, low, rs.State.Commit+1, backupBatchSize)
+		if err != nil {
+			return pb.Membership{}, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		m = rsm.ReplayMembership(shardID, replicaID, m, entries)
+		low = entries[len(entries)-1].Index + 1
+	}
+	return m, nil
+}
+
+func isShardViewMember(sv ShardView, replicaID uint64) bool {
+	for _, members := range []map[uint64]string{sv.Replicas,
+		sv.NonVotings, sv.Witnesses} {
+		if _, ok := members[replicaID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hasSavedSnapshots(dir string, fs vfs.IFS) (bool, error) {
+	names, err := fs.List(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if server.SnapshotDirNameRe.MatchString(name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// getDirStats returns the size of the specified directory and the last
+// modification time of its content.
+func getDirStats(dir string, fs vfs.IFS) (uint64, time.Time, error) {
+	fi, err := fs.Stat(dir)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	modTime := fi.ModTime()
+	names, err := fs.List(dir)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	sz := uint64(0)
+	for _, name := range names {
+		fp := fs.PathJoin(dir, name)
+		fi, err := fs.Stat(fp)
+		if err != nil {
+			if vfs.IsNotExist(err) {
+				continue
+			}
+			return 0, time.Time{}, err
+		}
+		if fi.IsDir() {
+			v, mt, err := getDirStats(fp, fs)
+			if err != nil {
+				return 0, time.Time{}, err
+			}
+			sz += v
+			if mt.After(modTime) {
+				modTime = mt
+			}
+			continue
+		}
+		sz += uint64(fi.Size())
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	return sz, modTime, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func TestOrphanTypeString(t *testing.T) {
+	if OrphanSnapshotDir.String() != "SnapshotDir" {
+		t.Errorf("unexpected name %s", OrphanSnapshotDir)
+	}
+	if OrphanType(100).String() != "OrphanType(100)" {
+		t.Errorf("unexpected name %s", OrphanType(100))
+	}
+}
+
+func TestOrphanedDataCanBeFoundAndPurged(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		listener := &testSysEventListener{}
+		nhc := nhs[1].NodeHostConfig()
+		nhs[1].Close()
+		nhc.SystemEventListener = listener
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			t.Fatalf("failed to create nodehost %v", err)
+		}
+		nhs[1] = nh
+		members := make(map[uint64]string)
+		for i := range nhs {
+			members[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(nh))
+		defer cancel()
+		for shardID := uint64(1); shardID <= 4; shardID++ {
+			startCloneTestShard(t, nhs, shardID, []uint64{1, 2, 3}, members)
+			if _, err := nhs[0].SyncPropose(ctx,
+				nhs[0].GetNoOPSession(shardID), []byte("a=1")); err != nil {
+				t.Fatalf("failed to propose %v", err)
+			}
+			if _, err := nh.SyncRequestSnapshot(ctx,
+				shardID, SnapshotOption{}); err != nil {
+				t.Fatalf("failed to request snapshot %v", err)
+			}
+		}
+		// replica 2 of shard 4 is stopped but it is still a member
+		if err := nh.StopShard(4); err != nil {
+			t.Fatalf("failed to stop shard %v", err)
+		}
+		// replica 2 of shards 1, 2 and 3 are removed from their shards
+		for shardID := uint64(1); shardID <= 3; shardID++ {
+			if err := nhs[0].SyncRequestDeleteReplica(ctx,
+				shardID, 2, 0); err != nil {
+				t.Fatalf("failed to delete replica %v", err)
+			}
+			for i := 0; ; i++ {
+				if _, ok := nh.getShard(shardID); !ok &&
+					!nh.engine.nodeLoaded(shardID, 2) {
+					break
+				}
+				if i > 200 {
+					t.Fatalf("replica not stopped")
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+		// RemoveData crashed after removing LogDB records of replica 2 of shard
+		// 2, and after marking the snapshot dir of replica 2 of shard 3 as
+		// removed
+		for _, shardID := range []uint64{2, 3} {
+			if err := nh.mu.logdb.RemoveNodeData(shardID, 2); err != nil {
+				t.Fatalf("failed to remove node data %v", err)
+			}
+		}
+		did := nh.nhConfig.GetDeploymentID()
+		dir := nh.env.GetSnapshotDir(did, 3, 2)
+		if err := fileutil.MarkDirAsDeleted(dir,
+			&pb.RaftDataStatus{}, nh.fs); err != nil {
+			t.Fatalf("failed to mark dir as deleted %v", err)
+		}
+		reports, err := nh.FindOrphanedData(ctx, OrphanOption{UseRegistry: true})
+		if err != nil {
+			t.Fatalf("failed to find orphaned data %v", err)
+		}
+		want := []OrphanType{
+			OrphanRemovedReplica, OrphanSnapshotDir, OrphanRemovedSnapshots,
+		}
+		if len(reports) != len(want) {
+			t.Fatalf("unexpected reports %v", reports)
+		}
+		for i, r := range reports {
+			if r.ShardID != uint64(i+1) || r.ReplicaID != 2 || r.Type != want[i] {
+				t.Errorf("unexpected report %v", r)
+			}
+			if r.Size == 0 || r.ModTime.IsZero() || len(r.Path) == 0 {
+				t.Errorf("unexpected report %+v", r)
+			}
+		}
+		if err := nh.PurgeOrphanedData(ctx,
+			reports, "invalid"); !errors.Is(err, ErrPurgeNotConfirmed) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if err := nh.PurgeOrphanedData(ctx, reports, nh.ID()); err != nil {
+			t.Fatalf("failed to purge orphaned data %v", err)
+		}
+		reports, err = nh.FindOrphanedData(ctx, OrphanOption{})
+		if err != nil {
+			t.Fatalf("failed to find orphaned data %v", err)
+		}
+		if len(reports) != 0 {
+			t.Errorf("orphaned data not purged, %v", reports)
+		}
+		if _, err := nh.mu.logdb.GetBootstrapInfo(1, 2); !errors.Is(err,
+			raftio.ErrNoBootstrapInfo) {
+			t.Errorf("LogDB records not removed, %v", err)
+		}
+		for i := 0; ; i++ {
+			if len(listener.getOrphanPurgeEvents()) == len(want) {
+				break
+			}
+			if i > 200 {
+				t.Fatalf("events not published, %v", listener.getOrphanPurgeEvents())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		for i, e := range listener.getOrphanPurgeEvents() {
+			if e.Completed != uint64(i+1) || e.Total != uint64(len(want)) {
+				t.Errorf("unexpected event %+v", e)
+			}
+		}
+		// the stopped member can still be restarted
+		startCloneTestShard(t, nhs[1:2], 4, []uint64{2}, nil)
+		if v := readCloneTestValue(t, nh, 4, "a"); v != "1" {
+			t.Errorf("unexpected value %s", v)
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
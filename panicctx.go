@@ -0,0 +1,182 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	// operations performed by engine workers
+	stepNodeOp          = "stepNode"
+	saveRaftStateOp     = "saveRaftState"
+	processRaftUpdateOp = "processRaftUpdate"
+	notifyCommitOp      = "notifyCommit"
+	applyOp             = "apply"
+	saveSnapshotOp      = "saveSnapshot"
+	recoverSnapshotOp   = "recoverSnapshot"
+	streamSnapshotOp    = "streamSnapshot"
+	destroyOp           = "destroy"
+)
+
+// EnginePanic is the value used for re-panicking when a panic is recovered
+// from an engine worker goroutine. It annotates the original panic value with
+// the replica and the operation being handled by the worker when the panic
+// occurred.
+type EnginePanic struct {
+	// Value is the value originally passed to panic.
+	Value interface{}
+	// Stack is the stack trace of the goroutine at the time of the original
+	// panic.
+	Stack []byte
+	// Worker is the role of the engine worker, e.g. "step" or "apply", and
+	// WorkerID is its ID.
+	Worker   string
+	WorkerID uint64
+	// Operation is the name of the operation being performed by the worker.
+	Operation string
+	// ShardID and ReplicaID identify the replica being handled by the worker,
+	// they are 0 when the operation involves multiple replicas.
+	ShardID   uint64
+	ReplicaID uint64
+	// FirstIndex and LastIndex are the index range of the Raft log entries
+	// being handled by the operation, they are 0 when not applicable.
+	FirstIndex uint64
+	LastIndex  uint64
+}
+
+func (p *EnginePanic) Error() string {
+	return fmt.Sprintf("%v, %s worker %d, %s, %s, index [%d, %d]",
+		p.Value, p.Worker, p.WorkerID, p.Operation,
+		dn(p.ShardID, p.ReplicaID), p.FirstIndex, p.LastIndex)
+}
+
+// Unwrap returns the original panic value when it is an error, nil is
+// returned otherwise.
+func (p *EnginePanic) Unwrap() error {
+	if err, ok := p.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// panicContext is the context of the operation being performed by an engine
+// worker goroutine, it is updated by the worker for each operation it
+// performs and is only accessed by the worker itself.
+type panicContext struct {
+	node     *node
+	events   *sysEventListener
+	worker   string
+	op       string
+	workerID uint64
+	first    uint64
+	last     uint64
+}
+
+func newPanicContext(worker string, workerID uint64) *panicContext {
+	return &panicContext{worker: worker, workerID: workerID}
+}
+
+// set records that the specified operation is being performed on node n.
+func (c *panicContext) set(op string, n *node) {
+	c.op, c.node, c.events = op, n, n.sysEvents
+	c.first, c.last = 0, 0
+}
+
+// setShared records that the specified operation is being performed on
+// multiple nodes.
+func (c *panicContext) setShared(op string) {
+	c.op, c.node = op, nil
+	c.first, c.last = 0, 0
+}
+
+// setRange records the index range of entries handled by the operation.
+func (c *panicContext) setRange(first uint64, last uint64) {
+	c.first, c.last = first, last
+}
+
+// annotate recovers the panic of the worker goroutine, logs and reports it
+// with the recorded context and re-panics with an *EnginePanic value. It must
+// be deferred at the top level of the worker goroutine.
+func (c *panicContext) annotate() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if _, ok := r.(*EnginePanic); ok {
+		panic(r)
+	}
+	p := c.getEnginePanic(r, debug.Stack())
+	plog.Errorf("%s worker %d panicked, %s, %s, index [%d, %d], %v\n%s",
+		p.Worker, p.WorkerID, p.Operation, dn(p.ShardID, p.ReplicaID),
+		p.FirstIndex, p.LastIndex, p.Value, p.Stack)
+	if c.events != nil {
+		// the process is about to crash, the event is delivered right away
+		// rather than being queued
+		c.events.handle(server.SystemEvent{
+			Type:       server.EnginePanicked,
+			ShardID:    p.ShardID,
+			ReplicaID:  p.ReplicaID,
+			Operation:  p.Operation,
+			FirstIndex: p.FirstIndex,
+			LastIndex:  p.LastIndex,
+			Reason:     fmt.Sprint(p.Value),
+		})
+	}
+	panic(p)
+}
+
+func (c *panicContext) getEnginePanic(r interface{},
+	stack []byte) *EnginePanic {
+	p := &EnginePanic{
+		Value:      r,
+		Stack:      stack,
+		Worker:     c.worker,
+		WorkerID:   c.workerID,
+		Operation:  c.op,
+		FirstIndex: c.first,
+		LastIndex:  c.last,
+	}
+	if c.node != nil {
+		p.ShardID, p.ReplicaID = c.node.shardID, c.node.replicaID
+		if c.op == applyOp && c.node.sm != nil {
+			p.FirstIndex, p.LastIndex = c.node.sm.GetApplyingRange()
+		}
+	}
+	return p
+}
+
+func getSnapshotOp(task rsm.Task) string {
+	if task.Recover {
+		return recoverSnapshotOp
+	} else if task.Save {
+		return saveSnapshotOp
+	}
+	return streamSnapshotOp
+}
+
+// getEntryRange returns the index range of the specified entries, 0, 0 is
+// returned when there is no entry.
+func getEntryRange(entries []pb.Entry) (uint64, uint64) {
+	if len(entries) == 0 {
+		return 0, 0
+	}
+	return entries[0].Index, entries[len(entries)-1].Index
+}
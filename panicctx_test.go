@@ -0,0 +1,211 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func getPanicValue(f func()) (r interface{}) {
+	defer func() {
+		r = recover()
+	}()
+	f()
+	return nil
+}
+
+func TestPanicIsAnnotatedWithContext(t *testing.T) {
+	listener := &testSysEventListener{}
+	n := &node{
+		shardID:   1,
+		replicaID: 2,
+		sysEvents: newSysEventListener(listener, 0),
+	}
+	pc := newPanicContext(stepWorkerRole, 3)
+	pc.set(saveRaftStateOp, n)
+	pc.setRange(10, 12)
+	err := errors.New("test error")
+	r := getPanicValue(func() {
+		defer pc.annotate()
+		panic(err)
+	})
+	p, ok := r.(*EnginePanic)
+	if !ok {
+		t.Fatalf("unexpected panic value %v", r)
+	}
+	if p.Worker != stepWorkerRole || p.WorkerID != 3 ||
+		p.Operation != saveRaftStateOp || p.ShardID != 1 || p.ReplicaID != 2 ||
+		p.FirstIndex != 10 || p.LastIndex != 12 {
+		t.Errorf("unexpected annotations %+v", p)
+	}
+	if p.Value != err || !errors.Is(p, err) {
+		t.Errorf("original value not preserved, %v", p.Value)
+	}
+	if !bytes.Contains(p.Stack, []byte("TestPanicIsAnnotatedWithContext")) {
+		t.Errorf("original stack not preserved, %s", p.Stack)
+	}
+	// the event is delivered before re-panicking
+	events := listener.getEnginePanicked()
+	if len(events) != 1 || events[0].ShardID != 1 || events[0].ReplicaID != 2 ||
+		events[0].Operation != saveRaftStateOp || events[0].FirstIndex != 10 ||
+		events[0].LastIndex != 12 || events[0].Panic != "test error" {
+		t.Errorf("unexpected events %+v", events)
+	}
+}
+
+func TestAnnotatedPanicIsNotAnnotatedAgain(t *testing.T) {
+	n := &node{shardID: 1, replicaID: 2}
+	outer := newPanicContext(stepWorkerRole, 1)
+	outer.set(stepNodeOp, n)
+	inner := newPanicContext(applyWorkerRole, 2)
+	inner.setShared(processRaftUpdateOp)
+	r := getPanicValue(func() {
+		defer outer.annotate()
+		func() {
+			defer inner.annotate()
+			panic("test panic")
+		}()
+	})
+	p, ok := r.(*EnginePanic)
+	if !ok {
+		t.Fatalf("unexpected panic value %v", r)
+	}
+	if p.Value != "test panic" || p.Worker != applyWorkerRole ||
+		p.Operation != processRaftUpdateOp || p.ShardID != 0 {
+		t.Errorf("unexpected annotations %+v", p)
+	}
+	if errors.Unwrap(p) != nil {
+		t.Errorf("unexpected unwrapped error")
+	}
+}
+
+type panicTestSM struct {
+	PST
+}
+
+func (s *panicTestSM) Update(e sm.Entry) (sm.Result, error) {
+	if string(e.Cmd) == "panic" {
+		panic("test panic")
+	}
+	return s.PST.Update(e)
+}
+
+func waitForEnginePanic(t *testing.T, nh *NodeHost) *EnginePanic {
+	t.Helper()
+	select {
+	case e := <-nh.engine.ec:
+		p, ok := e.(*EnginePanic)
+		if !ok {
+			t.Fatalf("unexpected error %v", e)
+		}
+		return p
+	case <-time.After(10 * time.Second):
+		t.Fatalf("engine didn't panic")
+	}
+	return nil
+}
+
+func TestStateMachinePanicIsAnnotated(t *testing.T) {
+	// error injection mode prevents the process from crashing
+	fs := vfs.Wrap(vfs.GetTestFS(), vfs.OnIndex(-1, vfs.OpWrite))
+	to := &testOption{
+		fsErrorInjection: true,
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &panicTestSM{}
+		},
+		tf: func(nh *NodeHost) {
+			pto := pto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			defer cancel()
+			session := nh.GetNoOPSession(1)
+			if _, err := nh.SyncPropose(ctx, session, []byte("test")); err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+			n, ok := nh.getShard(1)
+			if !ok {
+				t.Fatalf("failed to get node")
+			}
+			applied := n.sm.GetLastApplied()
+			ctx, cancel = context.WithTimeout(context.Background(), pto)
+			defer cancel()
+			if _, err := nh.SyncPropose(ctx, session, []byte("panic")); err != ErrTimeout {
+				t.Fatalf("proposal unexpectedly completed, %v", err)
+			}
+			p := waitForEnginePanic(t, nh)
+			if p.Value != "test panic" || p.Worker != applyWorkerRole ||
+				p.Operation != applyOp || p.ShardID != 1 || p.ReplicaID != 1 {
+				t.Errorf("unexpected annotations %+v", p)
+			}
+			if p.FirstIndex <= applied || p.LastIndex < p.FirstIndex {
+				t.Errorf("unexpected index range [%d, %d], applied %d",
+					p.FirstIndex, p.LastIndex, applied)
+			}
+			if !bytes.Contains(p.Stack, []byte("panicTestSM")) {
+				t.Errorf("original stack not preserved, %s", p.Stack)
+			}
+			listener := nh.events.sys.ul.(*testSysEventListener)
+			events := listener.getEnginePanicked()
+			if len(events) != 1 || events[0].Operation != applyOp ||
+				events[0].FirstIndex != p.FirstIndex ||
+				events[0].Panic != "test panic" {
+				t.Errorf("unexpected events %+v", events)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestLogDBErrorPanicIsAnnotated(t *testing.T) {
+	inj := vfs.OnIndex(-1, vfs.OpWrite)
+	fs := vfs.Wrap(vfs.GetTestFS(), inj)
+	to := &testOption{
+		fsErrorInjection: true,
+		defaultTestNode:  true,
+		tf: func(nh *NodeHost) {
+			if nh.mu.logdb.Name() == "Tan" {
+				t.Skip("skipped, using tan logdb")
+			}
+			inj.SetIndex(0)
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			session := nh.GetNoOPSession(1)
+			if _, err := nh.SyncPropose(ctx, session, []byte("test")); err != ErrTimeout {
+				t.Fatalf("proposal unexpectedly completed, %v", err)
+			}
+			p := waitForEnginePanic(t, nh)
+			if !strings.Contains(p.Error(), vfs.ErrInjected.Error()) {
+				t.Errorf("original value not preserved, %v", p.Value)
+			}
+			if p.Worker != stepWorkerRole || p.Operation != saveRaftStateOp ||
+				p.ShardID != 1 || p.ReplicaID != 1 {
+				t.Errorf("unexpected annotations %+v", p)
+			}
+			if p.FirstIndex == 0 || p.LastIndex < p.FirstIndex {
+				t.Errorf("unexpected index range [%d, %d]",
+					p.FirstIndex, p.LastIndex)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
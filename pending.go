@@ -0,0 +1,324 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	// defaultMaxPendingRequests is the max number of pending requests returned
+	// by NodeHost.ListPendingRequests when no limit is specified.
+	defaultMaxPendingRequests = 1000
+)
+
+// PendingRequestType is the type of a pending request.
+type PendingRequestType uint8
+
+const (
+	// PendingProposal is a proposal made by Propose or SyncPropose.
+	PendingProposal PendingRequestType = iota
+	// PendingReadIndex is a ReadIndex request made by ReadIndex or SyncRead.
+	PendingReadIndex
+	// PendingConfigChange is a membership change request.
+	PendingConfigChange
+	// PendingSnapshot is a snapshot request made by RequestSnapshot.
+	PendingSnapshot
+	// PendingLeaderTransfer is a leader transfer request not yet processed by
+	// the Raft protocol implementation.
+	PendingLeaderTransfer
+)
+
+var pendingRequestTypeNames = [...]string{
+	"Proposal",
+	"ReadIndex",
+	"ConfigChange",
+	"Snapshot",
+	"LeaderTransfer",
+}
+
+func (t PendingRequestType) String() string {
+	return pendingRequestTypeNames[t]
+}
+
+// PendingRequestStage is the stage of a pending request.
+type PendingRequestStage uint8
+
+const (
+	// RequestQueued indicates that the request is waiting to be processed by
+	// the Raft protocol implementation. ReadIndex requests stay in this stage
+	// until their read index is confirmed.
+	RequestQueued PendingRequestStage = iota
+	// RequestAppended indicates that the request has been appended to the Raft
+	// log at PendingRequestInfo.Index but not committed yet.
+	RequestAppended
+	// RequestAwaitingApply indicates that the request has been committed, or
+	// that the read index of a ReadIndex request has been confirmed, and it is
+	// waiting for the state machine to apply PendingRequestInfo.Index.
+	RequestAwaitingApply
+)
+
+var pendingRequestStageNames = [...]string{
+	"Queued",
+	"Appended",
+	"AwaitingApply",
+}
+
+func (s PendingRequestStage) String() string {
+	return pendingRequestStageNames[s]
+}
+
+// PendingRequestInfo describes a request pending on the local replica.
+type PendingRequestInfo struct {
+	Type  PendingRequestType
+	Stage PendingRequestStage
+	// Index is the log index of appended and committed requests, it is the
+	// confirmed read index of ReadIndex requests awaiting apply.
+	Index uint64
+	// Enqueued is the time when the request was made, it is zero for leader
+	// transfer requests.
+	Enqueued time.Time
+	// DeadlineTick is the logical clock tick at which the request times out.
+	DeadlineTick uint64
+	// PayloadSize is the size of the proposed command or the encoded config
+	// change in bytes.
+	PayloadSize uint64
+	// ClientID and SeriesID are the client session details of proposals.
+	ClientID uint64
+	SeriesID uint64
+}
+
+// pendingRequestCollector collects up to max PendingRequestInfo records.
+type pendingRequestCollector struct {
+	requests  []PendingRequestInfo
+	max       int
+	truncated bool
+}
+
+// add adds the specified record, it returns a boolean value indicating whether
+// more records can be added.
+func (c *pendingRequestCollector) add(info PendingRequestInfo) bool {
+	if len(c.requests) >= c.max {
+		c.truncated = true
+		return false
+	}
+	c.requests = append(c.requests, info)
+	return true
+}
+
+func (r *RequestState) pendingInfo(t PendingRequestType) PendingRequestInfo {
+	return PendingRequestInfo{
+		Type:         t,
+		Stage:        r.stage,
+		Index:        r.index,
+		Enqueued:     r.enqueued,
+		DeadlineTick: r.deadline,
+		PayloadSize:  r.size,
+		ClientID:     r.clientID,
+		SeriesID:     r.seriesID,
+	}
+}
+
+// setStage sets the stage of the pending request, the stage never goes back
+// once the request is committed.
+func (r *RequestState) setStage(stage PendingRequestStage, index uint64) {
+	if r.stage == RequestAwaitingApply {
+		return
+	}
+	r.stage = stage
+	r.index = index
+}
+
+func (p *pendingProposal) setStage(e pb.Entry, stage PendingRequestStage) {
+	pp := p.shards[e.Key%p.ps]
+	pp.setStage(e, stage)
+}
+
+func (p *pendingProposal) collect(c *pendingRequestCollector) bool {
+	for _, pp := range p.shards {
+		if !pp.collect(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *proposalShard) setStage(e pb.Entry, stage PendingRequestStage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ps, ok := p.pending[e.Key]; ok {
+		if ps.clientID == e.ClientID && ps.seriesID == e.SeriesID {
+			committed := stage == RequestAwaitingApply &&
+				ps.stage != RequestAwaitingApply
+			ps.setStage(stage, e.Index)
+			if committed {
+				ps.term = e.Term
+				if e.IsNoOPSession() {
+					ps.entryCommitted()
+				}
+			}
+		}
+	}
+}
+
+func (p *proposalShard) collect(c *pendingRequestCollector) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, ps := range p.pending {
+		if !c.add(ps.pendingInfo(PendingProposal)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *pendingReadIndex) collect(c *pendingRequestCollector) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.requests != nil {
+		if !p.requests.collect(c) {
+			return false
+		}
+	}
+	for _, rb := range p.batches {
+		for _, req := range rb.requests {
+			if req == nil {
+				continue
+			}
+			info := req.pendingInfo(PendingReadIndex)
+			if rb.index > 0 {
+				info.Stage = RequestAwaitingApply
+				info.Index = rb.index
+			}
+			if !c.add(info) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (q *readIndexQueue) collect(c *pendingRequestCollector) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, req := range q.targetQueue()[:q.idx] {
+		if !c.add(req.pendingInfo(PendingReadIndex)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *pendingConfigChange) setStage(key uint64,
+	stage PendingRequestStage, index uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending != nil && p.pending.key == key {
+		p.pending.setStage(stage, index)
+	}
+}
+
+func (p *pendingConfigChange) collect(c *pendingRequestCollector) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending == nil {
+		return true
+	}
+	return c.add(p.pending.pendingInfo(PendingConfigChange))
+}
+
+func (p *pendingSnapshot) collect(c *pendingRequestCollector) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending == nil {
+		return true
+	}
+	return c.add(p.pending.pendingInfo(PendingSnapshot))
+}
+
+func (l *pendingLeaderTransfer) collect(c *pendingRequestCollector) bool {
+	if len(l.leaderTransferC) == 0 {
+		return true
+	}
+	return c.add(PendingRequestInfo{Type: PendingLeaderTransfer})
+}
+
+// updatePendingStages updates the stages of the pending proposals and config
+// change appended or committed in the specified update.
+func (n *node) updatePendingStages(ud pb.Update) {
+	for _, e := range ud.EntriesToSave {
+		n.setPendingStage(e, RequestAppended)
+	}
+	for _, e := range ud.CommittedEntries {
+		n.setPendingStage(e, RequestAwaitingApply)
+	}
+}
+
+func (n *node) setPendingStage(e pb.Entry, stage PendingRequestStage) {
+	if e.IsProposal() {
+		n.pendingProposals.setStage(e, stage)
+	} else if e.Type == pb.ConfigChangeEntry {
+		n.pendingConfigChange.setStage(e.Key, stage, e.Index)
+	}
+}
+
+// listPendingRequests returns up to max pending requests and a boolean value
+// indicating whether there were more. Each pending queue is only locked for
+// copying its records.
+func (n *node) listPendingRequests(max int) ([]PendingRequestInfo, bool) {
+	c := &pendingRequestCollector{max: max}
+	sources := []func(*pendingRequestCollector) bool{
+		n.pendingLeaderTransfer.collect,
+		n.pendingSnapshot.collect,
+		n.pendingConfigChange.collect,
+		n.pendingReadIndexes.collect,
+		n.pendingProposals.collect,
+	}
+	for _, collect := range sources {
+		if !collect(c) {
+			break
+		}
+	}
+	sort.SliceStable(c.requests, func(i, j int) bool {
+		return c.requests[i].Enqueued.Before(c.requests[j].Enqueued)
+	})
+	return c.requests, c.truncated
+}
+
+// ListPendingRequests returns up to max requests pending on the local replica
+// of the specified shard, ordered by the time they were made, and a boolean
+// value indicating whether the result has been truncated. Up to 1000 requests
+// are returned when max is not positive. The returned info is intended for
+// diagnosing stuck shards, it is collected from the pending queues one at a
+// time and is not guaranteed to be a consistent snapshot.
+func (nh *NodeHost) ListPendingRequests(shardID uint64,
+	max int) ([]PendingRequestInfo, bool, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, false, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nil, false, ErrShardNotFound
+	}
+	if max <= 0 {
+		max = defaultMaxPendingRequests
+	}
+	requests, truncated := n.listPendingRequests(max)
+	return requests, truncated, nil
+}
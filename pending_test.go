@@ -0,0 +1,263 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func TestPendingProposalStagesAreTracked(t *testing.T) {
+	pp, c := getPendingProposal(false)
+	session := &client.Session{ClientID: 100, SeriesID: 200}
+	if _, err := pp.propose(context.Background(),
+		session, []byte("test data"), 100); err != nil {
+		t.Fatalf("failed to make proposal, %v", err)
+	}
+	n := &node{pendingProposals: pp}
+	requests, truncated := n.listPendingRequests(10)
+	if truncated || len(requests) != 1 {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+	r := requests[0]
+	if r.Type != PendingProposal || r.Stage != RequestQueued ||
+		r.PayloadSize != 9 || r.ClientID != 100 || r.SeriesID != 200 ||
+		r.DeadlineTick != 100 || r.Enqueued.IsZero() {
+		t.Errorf("unexpected request %+v", r)
+	}
+	e := c.get(false)[0]
+	e.Index = 5
+	for _, tt := range []struct {
+		ud    pb.Update
+		stage PendingRequestStage
+	}{
+		{pb.Update{EntriesToSave: []pb.Entry{e}}, RequestAppended},
+		{pb.Update{CommittedEntries: []pb.Entry{e}}, RequestAwaitingApply},
+		// committed requests never go back to the appended stage
+		{pb.Update{EntriesToSave: []pb.Entry{e}}, RequestAwaitingApply},
+	} {
+		n.updatePendingStages(tt.ud)
+		requests, _ := n.listPendingRequests(10)
+		if requests[0].Stage != tt.stage || requests[0].Index != 5 {
+			t.Errorf("unexpected request %+v, want stage %s", requests[0], tt.stage)
+		}
+	}
+	pp.applied(e.ClientID, e.SeriesID, e.Key, sm.Result{}, false)
+	if requests, _ := n.listPendingRequests(10); len(requests) != 0 {
+		t.Errorf("unexpected requests %+v", requests)
+	}
+}
+
+func TestPendingRequestsAreTruncated(t *testing.T) {
+	pp, _ := getPendingProposal(false)
+	n := &node{pendingProposals: pp}
+	n.pendingReadIndexes, _ = getPendingReadIndex()
+	pri := &n.pendingReadIndexes
+	for i := 0; i < 3; i++ {
+		if _, err := pp.propose(context.Background(),
+			getBlankTestSession(), nil, 100); err != nil {
+			t.Fatalf("failed to make proposal, %v", err)
+		}
+		if _, err := pri.read(context.Background(), 100); err != nil {
+			t.Fatalf("failed to read, %v", err)
+		}
+	}
+	requests, truncated := n.listPendingRequests(6)
+	if truncated || len(requests) != 6 {
+		t.Fatalf("unexpected requests %+v, truncated %t", requests, truncated)
+	}
+	for i := 1; i < len(requests); i++ {
+		if requests[i].Enqueued.Before(requests[i-1].Enqueued) {
+			t.Errorf("requests not sorted %+v", requests)
+		}
+	}
+	requests, truncated = n.listPendingRequests(4)
+	if !truncated || len(requests) != 4 {
+		t.Fatalf("unexpected requests %+v, truncated %t", requests, truncated)
+	}
+}
+
+func TestPendingReadIndexStagesAreReported(t *testing.T) {
+	n := &node{}
+	var q *readIndexQueue
+	n.pendingReadIndexes, q = getPendingReadIndex()
+	pri := &n.pendingReadIndexes
+	if _, err := pri.read(context.Background(), 100); err != nil {
+		t.Fatalf("failed to read, %v", err)
+	}
+	s := pri.nextCtx()
+	pri.add(s, q.get())
+	requests, _ := n.listPendingRequests(10)
+	if len(requests) != 1 || requests[0].Type != PendingReadIndex ||
+		requests[0].Stage != RequestQueued {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+	pri.addReady([]pb.ReadyToRead{{Index: 500, SystemCtx: s}})
+	requests, _ = n.listPendingRequests(10)
+	if len(requests) != 1 || requests[0].Stage != RequestAwaitingApply ||
+		requests[0].Index != 500 {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+	pri.applied(500)
+	if requests, _ := n.listPendingRequests(10); len(requests) != 0 {
+		t.Errorf("unexpected requests %+v", requests)
+	}
+}
+
+func TestPendingLeaderTransferIsReported(t *testing.T) {
+	n := &node{pendingLeaderTransfer: newPendingLeaderTransfer()}
+	if err := n.pendingLeaderTransfer.request(2); err != nil {
+		t.Fatalf("failed to request leader transfer, %v", err)
+	}
+	requests, _ := n.listPendingRequests(10)
+	if len(requests) != 1 || requests[0].Type != PendingLeaderTransfer {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+	if _, ok := n.pendingLeaderTransfer.get(); !ok {
+		t.Fatalf("leader transfer request not found")
+	}
+	if requests, _ := n.listPendingRequests(10); len(requests) != 0 {
+		t.Errorf("unexpected requests %+v", requests)
+	}
+}
+
+func TestPendingRequestsOfShardWithoutQuorumCanBeListed(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		getConfig := func(replicaID uint64) config.Config {
+			return config.Config{
+				ShardID:      1,
+				ReplicaID:    replicaID,
+				ElectionRTT:  10,
+				HeartbeatRTT: 1,
+				PreVote:      true,
+			}
+		}
+		nhs := make(map[uint64]*NodeHost)
+		defer func() {
+			for _, nh := range nhs {
+				nh.Close()
+			}
+		}()
+		for replicaID := uint64(1); replicaID <= 3; replicaID++ {
+			nhs[replicaID] = startThreeReplicaTestShard(t, fs,
+				getConfig(replicaID), nil)
+		}
+		waitForLeaderToBeElected(t, nhs[1], 1)
+		leaderID, _, _, err := nhs[1].GetLeaderID(1)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		leader := nhs[leaderID]
+		waitForLeaderID(t, leader, leaderID)
+		// CheckQuorum is not enabled, the leader keeps its role after losing the
+		// quorum and nothing can be committed. PreVote prevents restarted
+		// followers from disrupting the leader.
+		for replicaID, nh := range nhs {
+			if replicaID != leaderID {
+				nh.Close()
+				delete(nhs, replicaID)
+			}
+		}
+		timeout := 30 * time.Second
+		session := leader.GetNoOPSession(1)
+		prs, err := leader.Propose(session, []byte("test-data"), timeout)
+		if err != nil {
+			t.Fatalf("failed to make proposal %v", err)
+		}
+		rrs, err := leader.ReadIndex(1, timeout)
+		if err != nil {
+			t.Fatalf("failed to read %v", err)
+		}
+		crs, err := leader.RequestAddNonVoting(1, 4, "localhost:1", 0, timeout)
+		if err != nil {
+			t.Fatalf("failed to request config change %v", err)
+		}
+		appended := func(requests []PendingRequestInfo) bool {
+			count := 0
+			for _, r := range requests {
+				if r.Stage == RequestAppended && r.Index > 0 {
+					count++
+				}
+			}
+			return count == 2
+		}
+		var requests []PendingRequestInfo
+		for i := 0; i < 200; i++ {
+			requests, _, err = leader.ListPendingRequests(1, 0)
+			if err != nil {
+				t.Fatalf("failed to list pending requests %v", err)
+			}
+			if appended(requests) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(requests) != 3 || !appended(requests) {
+			t.Fatalf("unexpected requests %+v", requests)
+		}
+		types := make(map[PendingRequestType]PendingRequestInfo)
+		for _, r := range requests {
+			types[r.Type] = r
+		}
+		if p := types[PendingProposal]; p.PayloadSize != 9 ||
+			p.ClientID != session.ClientID || p.Enqueued.IsZero() ||
+			p.DeadlineTick == 0 {
+			t.Errorf("unexpected proposal %+v", p)
+		}
+		if r, ok := types[PendingReadIndex]; !ok || r.Stage != RequestQueued {
+			t.Errorf("unexpected read index %+v", r)
+		}
+		if cc := types[PendingConfigChange]; cc.Stage != RequestAppended ||
+			cc.PayloadSize == 0 {
+			t.Errorf("unexpected config change %+v", cc)
+		}
+		requests, truncated, err := leader.ListPendingRequests(1, 2)
+		if err != nil || !truncated || len(requests) != 2 {
+			t.Errorf("unexpected requests %+v, truncated %t, err %v",
+				requests, truncated, err)
+		}
+		// only one follower is restarted so it can't be elected without the
+		// entries appended by the leader
+		followerID := leaderID%3 + 1
+		nhs[followerID] = startThreeReplicaTestShard(t, fs,
+			getConfig(followerID), nil)
+		for _, rs := range []*RequestState{prs, rrs, crs} {
+			select {
+			case v := <-rs.ResultC():
+				if !v.Completed() {
+					t.Fatalf("unexpected result %v", v)
+				}
+			case <-time.After(timeout):
+				t.Fatalf("request not completed")
+			}
+		}
+		if requests, _, err := leader.ListPendingRequests(1, 0); err != nil ||
+			len(requests) != 0 {
+			t.Errorf("unexpected requests %+v, err %v", requests, err)
+		}
+		if _, _, err := leader.ListPendingRequests(2, 0); err != ErrShardNotFound {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
@@ -0,0 +1,399 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package chaostest runs declarative fault schedules against a number of
+in-process NodeHost instances.
+
+A Harness owns NodeHosts connected by the memtransport, each using its own
+fault injecting file system and all sharing a manually advanced clock from
+the clocktest package. A schedule is a list of steps, e.g. Partition, Heal,
+RestartNodeHost, PauseDiskSyncs, InjectDiskError and AdvanceClock, executed in
+order by the Run method. Invariants such as LeaderAgreement,
+AppliedIndexesConverge and NoDivergence can be asserted between steps using
+the Check step or after every step using Config.Invariants. Waiting for
+invariants to hold and for requests to complete advances the clock rather
+than sleeping.
+
+The Harness is closed by a cleanup function registered on the test, all
+NodeHosts are closed and all faults are cleared even when the test fails in
+the middle of a schedule.
+*/
+package chaostest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/tests"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/clocktest"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+)
+
+const (
+	// ShardID is the ID of the shard run by the harness.
+	ShardID = uint64(1)
+	// CurrentLeader can be used in place of a NodeHost index in steps to
+	// select the NodeHost of the current leader when the step is executed.
+	CurrentLeader = 0
+	// minRealWait is longer than the max backoff interval of transport
+	// circuit breakers.
+	minRealWait = 3 * time.Second
+)
+
+// Config is the configuration of a Harness.
+type Config struct {
+	// Dir is the directory in which NodeHost directories are created.
+	Dir string
+	// NodeHosts is the number of NodeHosts, each running a replica of the
+	// shard. It defaults to 3.
+	NodeHosts int
+	// RTTMillisecond is the RTTMillisecond of all NodeHosts. It defaults
+	// to 10.
+	RTTMillisecond uint64
+	// MaxWaitRTT is the max number of RTTs the clock is advanced for when
+	// waiting for invariants to hold or requests to complete. It defaults
+	// to 1000.
+	MaxWaitRTT int
+	// Invariants are checked after every step, each of them is expected to
+	// eventually hold within MaxWaitRTT.
+	Invariants []Invariant
+}
+
+func (c *Config) prepare() error {
+	if len(c.Dir) == 0 {
+		return errors.New("Dir not set")
+	}
+	if c.NodeHosts == 0 {
+		c.NodeHosts = 3
+	}
+	if c.RTTMillisecond == 0 {
+		c.RTTMillisecond = 10
+	}
+	if c.MaxWaitRTT == 0 {
+		c.MaxWaitRTT = 1000
+	}
+	return nil
+}
+
+// Harness owns a number of NodeHosts running a replica of the same shard.
+// NodeHosts are identified by their 1-based index, the i-th NodeHost uses
+// memtransport.Address(i) as its RaftAddress.
+type Harness struct {
+	t          testing.TB
+	cfg        Config
+	network    *memtransport.Network
+	clock      *clocktest.Clock
+	rtt        time.Duration
+	nhConfigs  []config.NodeHostConfig
+	members    map[uint64]dragonboat.Target
+	mu         sync.Mutex
+	nodeHosts  []*dragonboat.NodeHost
+	faults     []*diskFaults
+	replicaIDs []uint64
+	groups     map[int]int
+	nextID     uint64
+	seq        uint64
+	closed     bool
+}
+
+// NewHarness creates a Harness and waits for a leader to be elected, the
+// Harness is closed when the test and all its subtests complete.
+func NewHarness(t testing.TB, cfg Config) *Harness {
+	t.Helper()
+	if err := cfg.prepare(); err != nil {
+		t.Fatalf("invalid config %v", err)
+	}
+	h := &Harness{
+		t:         t,
+		cfg:       cfg,
+		network:   memtransport.NewNetwork(),
+		clock:     clocktest.NewClock(time.Now()),
+		rtt:       time.Duration(cfg.RTTMillisecond) * time.Millisecond,
+		members:   make(map[uint64]dragonboat.Target),
+		nodeHosts: make([]*dragonboat.NodeHost, cfg.NodeHosts),
+		groups:    make(map[int]int),
+		nextID:    uint64(cfg.NodeHosts) + 1,
+	}
+	t.Cleanup(h.Close)
+	h.nhConfigs = h.network.NodeHostConfigs(cfg.NodeHosts,
+		cfg.Dir, cfg.RTTMillisecond)
+	for i := range h.nhConfigs {
+		faults := newDiskFaults()
+		h.faults = append(h.faults, faults)
+		h.nhConfigs[i].Expert.FS = newFaultFS(vfs.DefaultFS, faults)
+		h.nhConfigs[i].Expert.Clock = h.clock
+		h.nhConfigs[i].Expert.LogDB = config.GetTinyMemLogDBConfig()
+		h.replicaIDs = append(h.replicaIDs, uint64(i+1))
+		h.members[uint64(i+1)] = memtransport.Address(i + 1)
+	}
+	for i := 1; i <= cfg.NodeHosts; i++ {
+		if err := h.start(i, false); err != nil {
+			t.Fatalf("failed to start NodeHost %d, %v", i, err)
+		}
+	}
+	if err := h.eventually(LeaderAgreement().Holds); err != nil {
+		t.Fatalf("no leader elected, %v", err)
+	}
+	return h
+}
+
+// Close closes all NodeHosts after clearing all faults. It is registered as
+// a cleanup function of the test by NewHarness.
+func (h *Harness) Close() {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return
+	}
+	h.closed = true
+	h.mu.Unlock()
+	h.network.Heal()
+	for _, f := range h.faults {
+		f.clear()
+	}
+	for i := range h.nodeHosts {
+		h.closeNodeHost(i + 1)
+	}
+}
+
+// NodeHost returns the i-th NodeHost, it returns nil when the NodeHost is not
+// running.
+func (h *Harness) NodeHost(i int) *dragonboat.NodeHost {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.nodeHosts[i-1]
+}
+
+// ReplicaID returns the replica ID of the replica on the i-th NodeHost.
+func (h *Harness) ReplicaID(i int) uint64 {
+	return h.replicaIDs[i-1]
+}
+
+// Clock returns the clock shared by all NodeHosts.
+func (h *Harness) Clock() *clocktest.Clock {
+	return h.clock
+}
+
+// Run executes the steps in order, the test fails immediately when a step
+// fails or when any of the Config.Invariants doesn't hold after a step.
+func (h *Harness) Run(steps ...Step) {
+	h.t.Helper()
+	for i, s := range steps {
+		if err := s.Do(h); err != nil {
+			h.t.Fatalf("step %d %s failed, %v", i, s.Name, err)
+		}
+		for _, inv := range h.cfg.Invariants {
+			if err := h.eventually(inv.Holds); err != nil {
+				h.t.Fatalf("invariant %s violated after step %d %s, %v",
+					inv.Name, i, s.Name, err)
+			}
+		}
+	}
+}
+
+func (h *Harness) start(i int, join bool) error {
+	h.faults[i-1].reset()
+	if err := os.MkdirAll(h.nhConfigs[i-1].NodeHostDir, 0755); err != nil {
+		return err
+	}
+	nh, err := dragonboat.NewNodeHost(h.nhConfigs[i-1])
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.nodeHosts[i-1] = nh
+	h.mu.Unlock()
+	rc := config.Config{
+		ShardID:            ShardID,
+		ReplicaID:          h.replicaIDs[i-1],
+		ElectionRTT:        10,
+		HeartbeatRTT:       1,
+		CheckQuorum:        true,
+		PreVote:            true,
+		SnapshotEntries:    20,
+		CompactionOverhead: 10,
+	}
+	members := h.members
+	if join {
+		members = nil
+	}
+	return nh.StartReplica(members, join, tests.NewHashStateMachine, rc)
+}
+
+func (h *Harness) closeNodeHost(i int) {
+	h.mu.Lock()
+	nh := h.nodeHosts[i-1]
+	h.nodeHosts[i-1] = nil
+	h.mu.Unlock()
+	if nh == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			// NodeHost.Close panics when closing its LogDB fails, failed writes
+			// caused by injected disk errors are reported again in such case
+			if !h.faults[i-1].errorInjected() {
+				panic(r)
+			}
+		}
+	}()
+	nh.Close()
+}
+
+// resolve returns the NodeHost index specified in a step.
+func (h *Harness) resolve(i int) (int, error) {
+	if i == CurrentLeader {
+		return h.leader()
+	}
+	if i < 1 || i > len(h.nodeHosts) {
+		return 0, errors.Errorf("invalid NodeHost index %d", i)
+	}
+	return i, nil
+}
+
+// leader returns the index of the NodeHost with the leader replica as known
+// by available NodeHosts.
+func (h *Harness) leader() (int, error) {
+	for _, i := range h.available() {
+		leaderID, _, ok, err := h.NodeHost(i).GetLeaderID(ShardID)
+		if err != nil || !ok {
+			continue
+		}
+		if idx := h.index(leaderID); idx > 0 {
+			return idx, nil
+		}
+	}
+	return 0, errors.New("no leader")
+}
+
+// index returns the index of the NodeHost of the specified replica.
+func (h *Harness) index(replicaID uint64) int {
+	for i, id := range h.replicaIDs {
+		if id == replicaID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (h *Harness) reachable(a int, b int) bool {
+	ga, gb := h.groups[a], h.groups[b]
+	return ga == 0 || gb == 0 || ga == gb
+}
+
+// available returns the indexes of running NodeHosts without disk faults
+// that can reach a quorum of such NodeHosts. With partitions that are not
+// transitive, e.g. when one NodeHost bridges two groups, available NodeHosts
+// might not be able to reach each other.
+func (h *Harness) available() []int {
+	var healthy []int
+	for i := 1; i <= len(h.nodeHosts); i++ {
+		if h.NodeHost(i) != nil && !h.faults[i-1].faulty() {
+			healthy = append(healthy, i)
+		}
+	}
+	quorum := len(h.nodeHosts)/2 + 1
+	var result []int
+	for _, a := range healthy {
+		count := 0
+		for _, b := range healthy {
+			if h.reachable(a, b) {
+				count++
+			}
+		}
+		if count >= quorum {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// tick advances the clock by one RTT and gives NodeHosts a chance to
+// exchange messages.
+func (h *Harness) tick() {
+	h.clock.Advance(h.rtt)
+	time.Sleep(time.Millisecond)
+}
+
+// eventually advances the clock until f returns nil or MaxWaitRTT is
+// reached, the last error returned by f is returned in the latter case. It
+// waits for at least minRealWait, circuit breakers of the transport back off
+// using the system clock rather than the clock of NodeHosts.
+func (h *Harness) eventually(f func(h *Harness) error) error {
+	var err error
+	start := time.Now()
+	for i := 0; i < h.cfg.MaxWaitRTT || time.Since(start) < minRealWait; i++ {
+		if err = f(h); err == nil {
+			return nil
+		}
+		h.tick()
+	}
+	return err
+}
+
+// call invokes f in its own goroutine and advances the clock until f
+// returns, the context passed to f times out after MaxWaitRTT/10 RTTs.
+func (h *Harness) call(f func(ctx context.Context) error) error {
+	timeout := time.Duration(h.cfg.MaxWaitRTT/10) * h.rtt
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- f(ctx)
+	}()
+	for i := 0; i < h.cfg.MaxWaitRTT; i++ {
+		select {
+		case err := <-done:
+			return err
+		default:
+		}
+		h.tick()
+	}
+	return errors.New("request not completed")
+}
+
+// propose proposes cmd on an available NodeHost, it is retried until it is
+// applied or MaxWaitRTT is reached. Retried proposals might be applied more
+// than once.
+func (h *Harness) propose(cmd []byte) error {
+	return h.eventually(func(h *Harness) error {
+		avail := h.available()
+		if len(avail) == 0 {
+			return errors.New("no available NodeHost")
+		}
+		nh := h.NodeHost(avail[0])
+		if i, err := h.leader(); err == nil && h.NodeHost(i) != nil {
+			nh = h.NodeHost(i)
+		}
+		return h.call(func(ctx context.Context) error {
+			_, err := nh.SyncPropose(ctx, nh.GetNoOPSession(ShardID), cmd)
+			return err
+		})
+	})
+}
+
+func (h *Harness) nextCmd() []byte {
+	h.seq++
+	return []byte(fmt.Sprintf("write-%d", h.seq))
+}
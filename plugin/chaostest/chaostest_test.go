@@ -0,0 +1,196 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaostest
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/logger"
+)
+
+func TestMain(m *testing.M) {
+	for _, name := range []string{"dragonboat", "raft", "rsm", "transport",
+		"logdb", "config", "registry"} {
+		logger.GetLogger(name).SetLevel(logger.ERROR)
+	}
+	m.Run()
+}
+
+var all = []Invariant{
+	LeaderAgreement(),
+	AppliedIndexesConverge(),
+	NoDivergence(),
+}
+
+func TestRollingRestart(t *testing.T) {
+	h := NewHarness(t, Config{Dir: t.TempDir()})
+	h.Run(
+		Write(30),
+		RestartNodeHost(1, true),
+		Check(all...),
+		Write(30),
+		RestartNodeHost(2, true),
+		Check(all...),
+		Write(30),
+		RestartNodeHost(3, false),
+		Check(all...),
+		Write(30),
+		RestartNodeHost(CurrentLeader, true),
+		Write(30),
+		Check(all...),
+	)
+	if h.ReplicaID(3) != 4 {
+		t.Errorf("replica on NodeHost 3 not replaced")
+	}
+}
+
+func TestAsymmetricPartition(t *testing.T) {
+	h := NewHarness(t, Config{Dir: t.TempDir()})
+	leader, err := h.leader()
+	if err != nil {
+		t.Fatalf("no leader %v", err)
+	}
+	follower := leader%3 + 1
+	// the third NodeHost can still reach both the leader and the follower
+	h.Run(
+		Write(10),
+		Partition([]int{leader}, []int{follower}),
+		AdvanceClock(50*h.rtt),
+		Write(10),
+		Heal(),
+		Write(10),
+		Check(all...),
+	)
+}
+
+func TestDiskStallOnLeader(t *testing.T) {
+	h := NewHarness(t, Config{Dir: t.TempDir()})
+	leader, err := h.leader()
+	if err != nil {
+		t.Fatalf("no leader %v", err)
+	}
+	h.Run(
+		Write(10),
+		PauseDiskSyncs(leader),
+		// the leader is stuck once it has entries to persist
+		Write(10),
+		Check(LeaderAgreement()),
+		ResumeDiskSyncs(leader),
+		Write(10),
+		Check(all...),
+	)
+	if newLeader, err := h.leader(); err != nil || newLeader == leader {
+		t.Errorf("leadership not moved away from the stalled leader")
+	}
+}
+
+func TestDiskErrorOnFollower(t *testing.T) {
+	h := NewHarness(t, Config{Dir: t.TempDir()})
+	leader, err := h.leader()
+	if err != nil {
+		t.Fatalf("no leader %v", err)
+	}
+	follower := leader%3 + 1
+	h.Run(
+		InjectDiskError(follower, "*.log"),
+		Write(10),
+		RestartNodeHost(follower, true),
+		Write(10),
+		Check(all...),
+	)
+}
+
+// fatalTB records the first fatal failure and terminates the goroutine
+// calling Fatalf, cleanup functions are run by the test using it.
+type fatalTB struct {
+	testing.TB
+	mu       sync.Mutex
+	failure  string
+	cleanups []func()
+}
+
+func (t *fatalTB) Helper() {}
+
+func (t *fatalTB) Cleanup(f func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cleanups = append(t.cleanups, f)
+}
+
+func (t *fatalTB) Fatalf(format string, args ...interface{}) {
+	t.mu.Lock()
+	t.failure = fmt.Sprintf(format, args...)
+	t.mu.Unlock()
+	runtime.Goexit()
+}
+
+func TestHarnessIsClosedWhenScheduleFails(t *testing.T) {
+	dir := t.TempDir()
+	tb := &fatalTB{TB: t}
+	var h *Harness
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h = NewHarness(tb, Config{Dir: dir, MaxWaitRTT: 100})
+		leader, err := h.leader()
+		if err != nil {
+			t.Errorf("no leader %v", err)
+			return
+		}
+		h.Run(
+			PauseDiskSyncs(leader),
+			// fails as the leader with paused syncs stays unavailable
+			Check(Invariant{
+				Name: "AllAvailable",
+				Holds: func(h *Harness) error {
+					if len(h.available()) != 3 {
+						return fmt.Errorf("not all available")
+					}
+					return nil
+				},
+			}),
+		)
+		t.Errorf("schedule didn't fail")
+	}()
+	<-done
+	if len(tb.failure) == 0 {
+		t.Fatalf("failure not reported")
+	}
+	if len(tb.cleanups) != 1 {
+		t.Fatalf("cleanup not registered")
+	}
+	tb.cleanups[0]()
+	for i := 1; i <= 3; i++ {
+		if h.NodeHost(i) != nil {
+			t.Errorf("NodeHost %d not closed", i)
+		}
+	}
+	// NodeHost directories are no longer locked
+	h2 := NewHarness(t, Config{Dir: dir})
+	h2.Run(Write(1), Check(LeaderAgreement()))
+}
+
+func TestAdvanceClock(t *testing.T) {
+	h := NewHarness(t, Config{Dir: t.TempDir()})
+	start := h.Clock().Now()
+	h.Run(AdvanceClock(time.Second))
+	if d := h.Clock().Now().Sub(start); d != time.Second {
+		t.Errorf("clock advanced by %s", d)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaostest
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+// diskFaults are the disk faults of a NodeHost, they are consulted by every
+// file opened by the NodeHost.
+type diskFaults struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	paused   bool
+	patterns []string
+	// injected indicates whether any error has been injected since the last
+	// reset, it is not affected by clear.
+	injected bool
+}
+
+func newDiskFaults() *diskFaults {
+	f := &diskFaults{}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *diskFaults) pause() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paused = true
+}
+
+func (f *diskFaults) resume() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paused = false
+	f.cond.Broadcast()
+}
+
+func (f *diskFaults) inject(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.patterns = append(f.patterns, pattern)
+	f.injected = true
+	return nil
+}
+
+// clear removes all faults and unblocks all paused syncs.
+func (f *diskFaults) clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paused = false
+	f.patterns = nil
+	f.cond.Broadcast()
+}
+
+// reset clears all faults and the injected flag.
+func (f *diskFaults) reset() {
+	f.clear()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.injected = false
+}
+
+func (f *diskFaults) errorInjected() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.injected
+}
+
+func (f *diskFaults) faulty() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.paused || len(f.patterns) > 0
+}
+
+// maybeError blocks sync operations while syncs are paused, it returns
+// vfs.ErrInjected for write and sync operations on files with their base
+// names matching any injected pattern.
+func (f *diskFaults) maybeError(name string, op vfs.Op) error {
+	if op == vfs.OpRead {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for op == vfs.OpSync && f.paused {
+		f.cond.Wait()
+	}
+	base := filepath.Base(name)
+	for _, p := range f.patterns {
+		if ok, _ := filepath.Match(p, base); ok {
+			return vfs.ErrInjected
+		}
+	}
+	return nil
+}
+
+type fileInjector struct {
+	name   string
+	faults *diskFaults
+}
+
+func (i fileInjector) MaybeError(op vfs.Op) error {
+	return i.faults.maybeError(i.name, op)
+}
+
+type noInjector struct{}
+
+func (noInjector) MaybeError(op vfs.Op) error {
+	return nil
+}
+
+// faultFS is a vfs.IFS with all opened files subject to the disk faults.
+type faultFS struct {
+	vfs.IFS
+	faults *diskFaults
+}
+
+// newFaultFS returns a vfs.ErrorFS so NodeHost runs in its error injection
+// mode, failures of Raft workers caused by injected errors are then recovered
+// rather than crashing the process.
+func newFaultFS(fs vfs.IFS, faults *diskFaults) *vfs.ErrorFS {
+	return vfs.Wrap(&faultFS{IFS: fs, faults: faults}, noInjector{})
+}
+
+func (fs *faultFS) wrap(name string, f vfs.File, err error) (vfs.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return vfs.WrapFile(f, fileInjector{name: name, faults: fs.faults}), nil
+}
+
+func (fs *faultFS) Create(name string) (vfs.File, error) {
+	f, err := fs.IFS.Create(name)
+	return fs.wrap(name, f, err)
+}
+
+func (fs *faultFS) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	f, err := fs.IFS.Open(name, opts...)
+	return fs.wrap(name, f, err)
+}
+
+func (fs *faultFS) OpenReadWrite(name string,
+	opts ...vfs.OpenOption) (vfs.File, error) {
+	f, err := fs.IFS.OpenReadWrite(name, opts...)
+	return fs.wrap(name, f, err)
+}
+
+func (fs *faultFS) OpenDir(name string) (vfs.File, error) {
+	f, err := fs.IFS.OpenDir(name)
+	return fs.wrap(name, f, err)
+}
+
+func (fs *faultFS) OpenForAppend(name string) (vfs.File, error) {
+	f, err := fs.IFS.OpenForAppend(name)
+	return fs.wrap(name, f, err)
+}
+
+func (fs *faultFS) ReuseForWrite(oldname string,
+	newname string) (vfs.File, error) {
+	f, err := fs.IFS.ReuseForWrite(oldname, newname)
+	return fs.wrap(newname, f, err)
+}
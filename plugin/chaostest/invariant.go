@@ -0,0 +1,164 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaostest
+
+import (
+	"context"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+)
+
+// Invariant is a property of the shard expected to eventually hold. Holds is
+// invoked repeatedly with the clock advanced in between until it returns nil.
+type Invariant struct {
+	// Name describes the invariant in failure messages.
+	Name string
+	// Holds returns an error describing the violation when the invariant
+	// doesn't hold.
+	Holds func(h *Harness) error
+}
+
+// LeaderAgreement requires all available NodeHosts to know the same leader
+// in the same term, the leader must be on an available NodeHost.
+func LeaderAgreement() Invariant {
+	return Invariant{
+		Name: "LeaderAgreement",
+		Holds: func(h *Harness) error {
+			avail := h.available()
+			if len(avail) == 0 {
+				return errors.New("no available NodeHost")
+			}
+			var leaderID, term uint64
+			for _, i := range avail {
+				id, t, ok, err := h.NodeHost(i).GetLeaderID(ShardID)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return errors.Errorf("NodeHost %d has no leader", i)
+				}
+				if leaderID == 0 {
+					leaderID, term = id, t
+				} else if id != leaderID || t != term {
+					return errors.Errorf("NodeHost %d has leader %d term %d, "+
+						"NodeHost %d has leader %d term %d",
+						avail[0], leaderID, term, i, id, t)
+				}
+			}
+			idx := h.index(leaderID)
+			for _, i := range avail {
+				if i == idx {
+					return nil
+				}
+			}
+			return errors.Errorf("leader %d not available", leaderID)
+		},
+	}
+}
+
+// AppliedIndexesConverge requires all available NodeHosts to have applied all
+// committed entries and to have the same applied index.
+func AppliedIndexesConverge() Invariant {
+	return Invariant{
+		Name: "AppliedIndexesConverge",
+		Holds: func(h *Harness) error {
+			_, err := h.convergedIndex()
+			return err
+		},
+	}
+}
+
+func (h *Harness) convergedIndex() (uint64, error) {
+	avail := h.available()
+	if len(avail) == 0 {
+		return 0, errors.New("no available NodeHost")
+	}
+	var applied uint64
+	for _, i := range avail {
+		d, err := h.NodeHost(i).DumpRaftState(context.Background(), ShardID)
+		if err != nil {
+			return 0, err
+		}
+		if d.AppliedIndex != d.CommittedIndex {
+			return 0, errors.Errorf("NodeHost %d applied %d, committed %d",
+				i, d.AppliedIndex, d.CommittedIndex)
+		}
+		if applied == 0 {
+			applied = d.AppliedIndex
+		} else if d.AppliedIndex != applied {
+			return 0, errors.Errorf("NodeHost %d applied %d, NodeHost %d "+
+				"applied %d", avail[0], applied, i, d.AppliedIndex)
+		}
+	}
+	return applied, nil
+}
+
+// NoDivergence requires the state machines on all available NodeHosts to
+// have the same fingerprint. It waits for applied indexes to converge, has
+// each available NodeHost create a snapshot and compares the fingerprints
+// recorded at the latest index snapshotted by all of them.
+func NoDivergence() Invariant {
+	return Invariant{
+		Name: "NoDivergence",
+		Holds: func(h *Harness) error {
+			if _, err := h.convergedIndex(); err != nil {
+				return err
+			}
+			avail := h.available()
+			var nhs []*dragonboat.NodeHost
+			var common map[uint64]struct{}
+			for _, i := range avail {
+				nh := h.NodeHost(i)
+				nhs = append(nhs, nh)
+				if err := h.call(func(ctx context.Context) error {
+					_, err := nh.SyncRequestSnapshot(ctx,
+						ShardID, dragonboat.SnapshotOption{})
+					// rejected when there is no new entry since the last snapshot
+					if errors.Is(err, dragonboat.ErrRejected) {
+						return nil
+					}
+					return err
+				}); err != nil {
+					return err
+				}
+				fps, err := nh.GetSnapshotFingerprints(ShardID)
+				if err != nil {
+					return err
+				}
+				indexes := make(map[uint64]struct{})
+				for _, fp := range fps {
+					if common == nil {
+						indexes[fp.Index] = struct{}{}
+					} else if _, ok := common[fp.Index]; ok {
+						indexes[fp.Index] = struct{}{}
+					}
+				}
+				common = indexes
+			}
+			var index uint64
+			for v := range common {
+				if v > index {
+					index = v
+				}
+			}
+			if index == 0 {
+				return errors.New("no common fingerprint")
+			}
+			return dragonboat.CompareSnapshotFingerprints(ShardID, index, nhs...)
+		},
+	}
+}
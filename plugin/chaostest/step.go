@@ -0,0 +1,253 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaostest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+)
+
+// Step is a step of a schedule.
+type Step struct {
+	// Name describes the step in failure messages.
+	Name string
+	// Do executes the step.
+	Do func(h *Harness) error
+}
+
+// Partition splits the network into the specified groups of NodeHosts.
+// NodeHosts not included in any group can still reach all others, e.g.
+// Partition([]int{1}, []int{2}) cuts the link between the first two
+// NodeHosts while the third one can reach both of them.
+func Partition(groups ...[]int) Step {
+	return Step{
+		Name: fmt.Sprintf("Partition(%v)", groups),
+		Do: func(h *Harness) error {
+			h.groups = make(map[int]int)
+			addrs := make([][]string, 0, len(groups))
+			for gi, g := range groups {
+				var addr []string
+				for _, i := range g {
+					idx, err := h.resolve(i)
+					if err != nil {
+						return err
+					}
+					h.groups[idx] = gi + 1
+					addr = append(addr, memtransport.Address(idx))
+				}
+				addrs = append(addrs, addr)
+			}
+			h.network.Partition(addrs...)
+			return nil
+		},
+	}
+}
+
+// Heal removes all partitions.
+func Heal() Step {
+	return Step{
+		Name: "Heal",
+		Do: func(h *Harness) error {
+			h.groups = make(map[int]int)
+			h.network.Heal()
+			return nil
+		},
+	}
+}
+
+// RestartNodeHost closes and restarts the i-th NodeHost, all its disk faults
+// are cleared. When keepData is false, the NodeHost directory is removed and
+// the replica is replaced by a new replica with a new replica ID, the old
+// replica is deleted from the shard and the new one is added by an available
+// NodeHost before the restart.
+func RestartNodeHost(i int, keepData bool) Step {
+	return Step{
+		Name: fmt.Sprintf("RestartNodeHost(%d, %t)", i, keepData),
+		Do: func(h *Harness) error {
+			idx, err := h.resolve(i)
+			if err != nil {
+				return err
+			}
+			// faults are cleared first so paused syncs can't block the close
+			h.faults[idx-1].clear()
+			h.closeNodeHost(idx)
+			if keepData {
+				return h.start(idx, false)
+			}
+			if err := os.RemoveAll(h.nhConfigs[idx-1].NodeHostDir); err != nil {
+				return err
+			}
+			if err := h.replace(idx); err != nil {
+				return err
+			}
+			return h.start(idx, true)
+		},
+	}
+}
+
+// replace replaces the replica on the i-th NodeHost with a new replica.
+func (h *Harness) replace(i int) error {
+	oldID := h.replicaIDs[i-1]
+	newID := h.nextID
+	change := func(f func(ctx context.Context, nh *dragonboat.NodeHost) error) error {
+		return h.eventually(func(h *Harness) error {
+			avail := h.available()
+			if len(avail) == 0 {
+				return errors.New("no available NodeHost")
+			}
+			nh := h.NodeHost(avail[0])
+			return h.call(func(ctx context.Context) error {
+				return f(ctx, nh)
+			})
+		})
+	}
+	if err := change(func(ctx context.Context, nh *dragonboat.NodeHost) error {
+		m, err := nh.SyncGetShardMembership(ctx, ShardID)
+		if err != nil {
+			return err
+		}
+		if _, ok := m.Nodes[oldID]; !ok {
+			return nil
+		}
+		return nh.SyncRequestDeleteReplica(ctx, ShardID, oldID, 0)
+	}); err != nil {
+		return errors.Wrapf(err, "failed to delete replica %d", oldID)
+	}
+	if err := change(func(ctx context.Context, nh *dragonboat.NodeHost) error {
+		m, err := nh.SyncGetShardMembership(ctx, ShardID)
+		if err != nil {
+			return err
+		}
+		if _, ok := m.Nodes[newID]; ok {
+			return nil
+		}
+		return nh.SyncRequestAddReplica(ctx,
+			ShardID, newID, memtransport.Address(i), 0)
+	}); err != nil {
+		return errors.Wrapf(err, "failed to add replica %d", newID)
+	}
+	h.nextID++
+	h.replicaIDs[i-1] = newID
+	return nil
+}
+
+// PauseDiskSyncs blocks all fsync operations of the i-th NodeHost until
+// ResumeDiskSyncs or RestartNodeHost is executed. The NodeHost is not
+// considered as available while its syncs are paused.
+func PauseDiskSyncs(i int) Step {
+	return Step{
+		Name: fmt.Sprintf("PauseDiskSyncs(%d)", i),
+		Do: func(h *Harness) error {
+			idx, err := h.resolve(i)
+			if err != nil {
+				return err
+			}
+			h.faults[idx-1].pause()
+			return nil
+		},
+	}
+}
+
+// ResumeDiskSyncs resumes fsync operations paused by PauseDiskSyncs.
+func ResumeDiskSyncs(i int) Step {
+	return Step{
+		Name: fmt.Sprintf("ResumeDiskSyncs(%d)", i),
+		Do: func(h *Harness) error {
+			idx, err := h.resolve(i)
+			if err != nil {
+				return err
+			}
+			h.faults[idx-1].resume()
+			return nil
+		},
+	}
+}
+
+// InjectDiskError makes all write and sync operations on files of the i-th
+// NodeHost fail when the base names of the files match the specified
+// filepath.Match pattern, e.g. "*.log" for LogDB WAL files. Errors are
+// injected until the NodeHost is restarted by RestartNodeHost, the NodeHost
+// is not considered as available in the meantime.
+func InjectDiskError(i int, pattern string) Step {
+	return Step{
+		Name: fmt.Sprintf("InjectDiskError(%d, %q)", i, pattern),
+		Do: func(h *Harness) error {
+			idx, err := h.resolve(i)
+			if err != nil {
+				return err
+			}
+			return h.faults[idx-1].inject(pattern)
+		},
+	}
+}
+
+// AdvanceClock advances the clock shared by all NodeHosts by d, one RTT at a
+// time.
+func AdvanceClock(d time.Duration) Step {
+	return Step{
+		Name: fmt.Sprintf("AdvanceClock(%s)", d),
+		Do: func(h *Harness) error {
+			for elapsed := time.Duration(0); elapsed < d; elapsed += h.rtt {
+				h.tick()
+			}
+			return nil
+		},
+	}
+}
+
+// Write proposes count entries, each of them is retried until it is applied.
+func Write(count int) Step {
+	return Step{
+		Name: fmt.Sprintf("Write(%d)", count),
+		Do: func(h *Harness) error {
+			for i := 0; i < count; i++ {
+				if err := h.propose(h.nextCmd()); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// Check waits for all specified invariants to hold, advancing the clock for
+// up to Config.MaxWaitRTT for each of them.
+func Check(invariants ...Invariant) Step {
+	name := "Check("
+	for i, inv := range invariants {
+		if i > 0 {
+			name += ", "
+		}
+		name += inv.Name
+	}
+	return Step{
+		Name: name + ")",
+		Do: func(h *Harness) error {
+			for _, inv := range invariants {
+				if err := h.eventually(inv.Holds); err != nil {
+					return errors.Wrapf(err, "invariant %s", inv.Name)
+				}
+			}
+			return nil
+		},
+	}
+}
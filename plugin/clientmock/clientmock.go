@@ -0,0 +1,377 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package clientmock provides a scriptable in-memory implementation of the
+dragonboat.Client interface for unit testing applications without running
+any Raft shard.
+
+Shards are scripted using SetShard, requests made to shards not set are
+failed with dragonboat.ErrShardNotFound. Errors such as dragonboat.ErrTimeout,
+dragonboat.ErrShardNotReady or dragonboat.ErrRejected can be injected into
+the Nth call of a method using Fail. All calls are recorded for assertions.
+*/
+package clientmock
+
+import (
+	"context"
+	"sync"
+
+	"github.com/lni/goutils/random"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/client"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// Method is the name of a dragonboat.Client method.
+type Method string
+
+const (
+	// GetNoOPSession is the GetNoOPSession method.
+	GetNoOPSession Method = "GetNoOPSession"
+	// SyncGetSession is the SyncGetSession method.
+	SyncGetSession Method = "SyncGetSession"
+	// SyncCloseSession is the SyncCloseSession method.
+	SyncCloseSession Method = "SyncCloseSession"
+	// SyncPropose is the SyncPropose method.
+	SyncPropose Method = "SyncPropose"
+	// SyncRead is the SyncRead method.
+	SyncRead Method = "SyncRead"
+	// SyncGetShardMembership is the SyncGetShardMembership method.
+	SyncGetShardMembership Method = "SyncGetShardMembership"
+	// GetLeaderID is the GetLeaderID method.
+	GetLeaderID Method = "GetLeaderID"
+	// SyncRequestSnapshot is the SyncRequestSnapshot method.
+	SyncRequestSnapshot Method = "SyncRequestSnapshot"
+)
+
+// Shard is the scripted behavior of a shard. Propose and Read are invoked with
+// the Client locked, they must not call the Client.
+type Shard struct {
+	// Propose returns the result of a proposal. When it is nil, the index of
+	// the proposal in the shard, starting from 1, is returned as Result.Value.
+	Propose func(cmd []byte) (sm.Result, error)
+	// Read returns the result of a linearizable read. When it is nil, reads
+	// return a nil result.
+	Read func(query interface{}) (interface{}, error)
+	// Membership is returned by SyncGetShardMembership.
+	Membership dragonboat.Membership
+	// LeaderID and Term are returned by GetLeaderID, the leader is reported as
+	// not available when LeaderID is 0.
+	LeaderID uint64
+	Term     uint64
+}
+
+// Call is a recorded call.
+type Call struct {
+	Method  Method
+	ShardID uint64
+	// ClientID and SeriesID are the ClientID and SeriesID of the client session
+	// used by the call.
+	ClientID uint64
+	SeriesID uint64
+	// Cmd is a copy of the proposed command.
+	Cmd []byte
+	// Query is the query of SyncRead.
+	Query interface{}
+	// Err is the error returned by the call.
+	Err error
+}
+
+type fault struct {
+	method  Method
+	shardID uint64
+	n       int
+	err     error
+}
+
+type shard struct {
+	Shard
+	proposals uint64
+	snapshots uint64
+	sessions  map[uint64]struct{}
+}
+
+// Client is a scriptable in-memory dragonboat.Client implementation. It is
+// safe for concurrent use.
+type Client struct {
+	mu     sync.Mutex
+	rng    random.Source
+	shards map[uint64]*shard
+	faults []fault
+	counts map[Method]map[uint64]int
+	calls  []Call
+}
+
+var _ dragonboat.Client = (*Client)(nil)
+
+// New returns a new Client with no shard.
+func New() *Client {
+	return &Client{
+		rng:    random.NewLockedRand(),
+		shards: make(map[uint64]*shard),
+		counts: make(map[Method]map[uint64]int),
+	}
+}
+
+// SetShard sets the scripted behavior of the specified shard, previously
+// registered client sessions of the shard are kept.
+func (c *Client) SetShard(shardID uint64, s Shard) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sh, ok := c.shards[shardID]; ok {
+		sh.Shard = s
+		return
+	}
+	c.shards[shardID] = &shard{Shard: s, sessions: make(map[uint64]struct{})}
+}
+
+// Fail makes the nth call of the method returns err, n starts from 1 and
+// counts calls of the method made since the Client was created. Only calls
+// made to the specified shard are counted when shardID is not 0. The call
+// failed by an injected error has no other effect.
+func (c *Client) Fail(method Method, shardID uint64, n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults = append(c.faults,
+		fault{method: method, shardID: shardID, n: n, err: err})
+}
+
+// Calls returns all recorded calls in the order they were made.
+func (c *Client) Calls() []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Call(nil), c.calls...)
+}
+
+// CallsTo returns recorded calls of the specified method.
+func (c *Client) CallsTo(method Method) []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var result []Call
+	for _, call := range c.calls {
+		if call.Method == method {
+			result = append(result, call)
+		}
+	}
+	return result
+}
+
+// start counts the call and returns the shard along with the error to be
+// returned by the call, c.mu must be held.
+func (c *Client) start(ctx context.Context,
+	method Method, shardID uint64) (*shard, error) {
+	if c.counts[method] == nil {
+		c.counts[method] = make(map[uint64]int)
+	}
+	c.counts[method][0]++
+	c.counts[method][shardID]++
+	for _, f := range c.faults {
+		if f.method == method && c.counts[method][f.shardID] == f.n &&
+			(f.shardID == 0 || f.shardID == shardID) {
+			return nil, f.err
+		}
+	}
+	if ctx != nil {
+		if _, ok := ctx.Deadline(); !ok {
+			return nil, dragonboat.ErrDeadlineNotSet
+		}
+		if ctx.Err() != nil {
+			return nil, dragonboat.ErrTimeout
+		}
+	}
+	s, ok := c.shards[shardID]
+	if !ok {
+		return nil, dragonboat.ErrShardNotFound
+	}
+	return s, nil
+}
+
+// record records the call and returns its error, c.mu must be held.
+func (c *Client) record(call Call) error {
+	c.calls = append(c.calls, call)
+	return call.Err
+}
+
+// GetNoOPSession returns a NO-OP client session for the specified shard.
+func (c *Client) GetNoOPSession(shardID uint64) *client.Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cs := client.NewNoOPSession(shardID, c.rng)
+	c.record(Call{Method: GetNoOPSession, ShardID: shardID,
+		ClientID: cs.ClientID, SeriesID: cs.SeriesID})
+	return cs
+}
+
+// SyncGetSession registers and returns a new client session.
+func (c *Client) SyncGetSession(ctx context.Context,
+	shardID uint64) (*client.Session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, err := c.start(ctx, SyncGetSession, shardID)
+	if err != nil {
+		return nil, c.record(Call{Method: SyncGetSession,
+			ShardID: shardID, Err: err})
+	}
+	cs := client.NewSession(shardID, c.rng)
+	cs.PrepareForPropose()
+	s.sessions[cs.ClientID] = struct{}{}
+	c.record(Call{Method: SyncGetSession, ShardID: shardID,
+		ClientID: cs.ClientID, SeriesID: cs.SeriesID})
+	return cs, nil
+}
+
+// SyncCloseSession unregisters the specified client session.
+func (c *Client) SyncCloseSession(ctx context.Context,
+	cs *client.Session) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	call := Call{Method: SyncCloseSession, ShardID: cs.ShardID,
+		ClientID: cs.ClientID, SeriesID: cs.SeriesID}
+	s, err := c.start(ctx, SyncCloseSession, cs.ShardID)
+	if err == nil {
+		if _, ok := s.sessions[cs.ClientID]; !ok {
+			err = dragonboat.ErrInvalidSession
+		}
+		delete(s.sessions, cs.ClientID)
+	}
+	call.Err = err
+	return c.record(call)
+}
+
+// SyncPropose makes a proposal using the specified client session. Proposals
+// made with client sessions not registered by SyncGetSession are failed with
+// dragonboat.ErrInvalidSession.
+func (c *Client) SyncPropose(ctx context.Context,
+	session *client.Session, cmd []byte) (sm.Result, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	call := Call{Method: SyncPropose, ShardID: session.ShardID,
+		ClientID: session.ClientID, SeriesID: session.SeriesID,
+		Cmd: append([]byte(nil), cmd...)}
+	s, err := c.start(ctx, SyncPropose, session.ShardID)
+	if err == nil && !session.IsNoOPSession() {
+		if _, ok := s.sessions[session.ClientID]; !ok {
+			err = dragonboat.ErrInvalidSession
+		}
+	}
+	var result sm.Result
+	if err == nil {
+		s.proposals++
+		if s.Propose != nil {
+			result, err = s.Propose(call.Cmd)
+		} else {
+			result = sm.Result{Value: s.proposals}
+		}
+	}
+	call.Err = err
+	return result, c.record(call)
+}
+
+// SyncRead performs a linearizable read on the specified shard.
+func (c *Client) SyncRead(ctx context.Context, shardID uint64,
+	query interface{}) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, err := c.start(ctx, SyncRead, shardID)
+	var result interface{}
+	if err == nil && s.Read != nil {
+		result, err = s.Read(query)
+	}
+	return result, c.record(Call{Method: SyncRead,
+		ShardID: shardID, Query: query, Err: err})
+}
+
+// SyncGetShardMembership returns the membership of the specified shard.
+func (c *Client) SyncGetShardMembership(ctx context.Context,
+	shardID uint64) (*dragonboat.Membership, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, err := c.start(ctx, SyncGetShardMembership, shardID)
+	if err != nil {
+		return nil, c.record(Call{Method: SyncGetShardMembership,
+			ShardID: shardID, Err: err})
+	}
+	m := copyMembership(s.Membership)
+	c.record(Call{Method: SyncGetShardMembership, ShardID: shardID})
+	return &m, nil
+}
+
+// GetLeaderID returns the scripted leader of the specified shard.
+func (c *Client) GetLeaderID(shardID uint64) (uint64, uint64, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, err := c.start(nil, GetLeaderID, shardID)
+	if err != nil {
+		return 0, 0, false, c.record(Call{Method: GetLeaderID,
+			ShardID: shardID, Err: err})
+	}
+	c.record(Call{Method: GetLeaderID, ShardID: shardID})
+	return s.LeaderID, s.Term, s.LeaderID != 0, nil
+}
+
+// SyncRequestSnapshot requests a snapshot of the specified shard, the index of
+// the last proposal is returned as the snapshot index.
+func (c *Client) SyncRequestSnapshot(ctx context.Context,
+	shardID uint64, opt dragonboat.SnapshotOption) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, err := c.start(ctx, SyncRequestSnapshot, shardID)
+	var index uint64
+	if err == nil {
+		if s.proposals == s.snapshots {
+			err = dragonboat.ErrRejected
+		} else {
+			s.snapshots = s.proposals
+			index = s.proposals
+		}
+	}
+	return index, c.record(Call{Method: SyncRequestSnapshot,
+		ShardID: shardID, Err: err})
+}
+
+func copyMembership(m dragonboat.Membership) dragonboat.Membership {
+	cp := func(v map[uint64]string) map[uint64]string {
+		if v == nil {
+			return nil
+		}
+		result := make(map[uint64]string, len(v))
+		for k, addr := range v {
+			result[k] = addr
+		}
+		return result
+	}
+	return dragonboat.Membership{
+		ConfigChangeID:   m.ConfigChangeID,
+		Nodes:            cp(m.Nodes),
+		NonVotings:       cp(m.NonVotings),
+		Witnesses:        cp(m.Witnesses),
+		Removed:          copyRemoved(m.Removed),
+		PrunedRemoved:    m.PrunedRemoved,
+		PrunedRemovedMax: m.PrunedRemovedMax,
+		Outgoing:         cp(m.Outgoing),
+	}
+}
+
+func copyRemoved(v map[uint64]struct{}) map[uint64]struct{} {
+	if v == nil {
+		return nil
+	}
+	result := make(map[uint64]struct{}, len(v))
+	for k := range v {
+		result[k] = struct{}{}
+	}
+	return result
+}
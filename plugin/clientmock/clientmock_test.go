@@ -0,0 +1,205 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clientmock
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func getTestContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestUnknownShardIsReported(t *testing.T) {
+	c := New()
+	ctx := getTestContext(t)
+	if _, err := c.SyncRead(ctx, 1, nil); !errors.Is(err,
+		dragonboat.ErrShardNotFound) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, _, _, err := c.GetLeaderID(1); !errors.Is(err,
+		dragonboat.ErrShardNotFound) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestDeadlineIsRequired(t *testing.T) {
+	c := New()
+	c.SetShard(1, Shard{})
+	if _, err := c.SyncRead(context.Background(), 1, nil); !errors.Is(err,
+		dragonboat.ErrDeadlineNotSet) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestScriptedResultsAreReturned(t *testing.T) {
+	c := New()
+	c.SetShard(1, Shard{
+		Propose: func(cmd []byte) (sm.Result, error) {
+			return sm.Result{Value: uint64(len(cmd)), Data: cmd}, nil
+		},
+		Read: func(query interface{}) (interface{}, error) {
+			return query.(string) + "-value", nil
+		},
+		Membership: dragonboat.Membership{Nodes: map[uint64]string{1: "a1"}},
+		LeaderID:   1,
+		Term:       2,
+	})
+	c.SetShard(2, Shard{})
+	ctx := getTestContext(t)
+	result, err := c.SyncPropose(ctx, c.GetNoOPSession(1), []byte("cmd"))
+	if err != nil || result.Value != 3 || !bytes.Equal(result.Data, []byte("cmd")) {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+	v, err := c.SyncRead(ctx, 1, "key")
+	if err != nil || v.(string) != "key-value" {
+		t.Errorf("unexpected read result %v, %v", v, err)
+	}
+	m, err := c.SyncGetShardMembership(ctx, 1)
+	if err != nil || m.Nodes[1] != "a1" {
+		t.Errorf("unexpected membership %v, %v", m, err)
+	}
+	// returned membership is a copy
+	m.Nodes[2] = "a2"
+	if m, _ := c.SyncGetShardMembership(ctx, 1); len(m.Nodes) != 1 {
+		t.Errorf("scripted membership changed")
+	}
+	leaderID, term, ok, err := c.GetLeaderID(1)
+	if err != nil || !ok || leaderID != 1 || term != 2 {
+		t.Errorf("unexpected leader %d, %d, %t, %v", leaderID, term, ok, err)
+	}
+	if _, _, ok, _ := c.GetLeaderID(2); ok {
+		t.Errorf("leader unexpectedly available")
+	}
+	// proposal indexes are returned by default
+	for i := uint64(1); i <= 2; i++ {
+		result, err := c.SyncPropose(ctx, c.GetNoOPSession(2), nil)
+		if err != nil || result.Value != i {
+			t.Errorf("unexpected result %v, %v", result, err)
+		}
+	}
+	index, err := c.SyncRequestSnapshot(ctx, 2, dragonboat.SnapshotOption{})
+	if err != nil || index != 2 {
+		t.Errorf("unexpected snapshot index %d, %v", index, err)
+	}
+	if _, err := c.SyncRequestSnapshot(ctx,
+		2, dragonboat.SnapshotOption{}); !errors.Is(err, dragonboat.ErrRejected) {
+		t.Errorf("snapshot without new proposal not rejected, %v", err)
+	}
+}
+
+func TestClientSessions(t *testing.T) {
+	c := New()
+	c.SetShard(1, Shard{})
+	ctx := getTestContext(t)
+	cs, err := c.SyncGetSession(ctx, 1)
+	if err != nil {
+		t.Fatalf("failed to get session %v", err)
+	}
+	if _, err := c.SyncPropose(ctx, cs, []byte("cmd")); err != nil {
+		t.Fatalf("proposal failed %v", err)
+	}
+	cs.ProposalCompleted()
+	if err := c.SyncCloseSession(ctx, cs); err != nil {
+		t.Fatalf("failed to close session %v", err)
+	}
+	if _, err := c.SyncPropose(ctx, cs, []byte("cmd")); !errors.Is(err,
+		dragonboat.ErrInvalidSession) {
+		t.Errorf("closed session not rejected, %v", err)
+	}
+	if err := c.SyncCloseSession(ctx, cs); !errors.Is(err,
+		dragonboat.ErrInvalidSession) {
+		t.Errorf("closed session not rejected, %v", err)
+	}
+}
+
+func TestErrorsAreInjectedIntoNthCall(t *testing.T) {
+	c := New()
+	c.SetShard(1, Shard{})
+	c.SetShard(2, Shard{})
+	c.Fail(SyncPropose, 0, 2, dragonboat.ErrTimeout)
+	c.Fail(SyncPropose, 2, 2, dragonboat.ErrShardNotReady)
+	c.Fail(SyncRead, 1, 1, dragonboat.ErrRejected)
+	ctx := getTestContext(t)
+	propose := func(shardID uint64) error {
+		_, err := c.SyncPropose(ctx, c.GetNoOPSession(shardID), nil)
+		return err
+	}
+	if err := propose(1); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := propose(2); !errors.Is(err, dragonboat.ErrTimeout) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := propose(1); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := propose(2); !errors.Is(err, dragonboat.ErrShardNotReady) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := c.SyncRead(ctx, 2, nil); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := c.SyncRead(ctx, 1, nil); !errors.Is(err, dragonboat.ErrRejected) {
+		t.Errorf("unexpected error %v", err)
+	}
+	// failed proposals are not applied
+	result, err := c.SyncPropose(ctx, c.GetNoOPSession(2), nil)
+	if err != nil || result.Value != 1 {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+}
+
+func TestCallsAreRecorded(t *testing.T) {
+	c := New()
+	c.SetShard(1, Shard{})
+	c.Fail(SyncRead, 0, 1, dragonboat.ErrTimeout)
+	ctx := getTestContext(t)
+	cs := c.GetNoOPSession(1)
+	cmd := []byte("cmd")
+	if _, err := c.SyncPropose(ctx, cs, cmd); err != nil {
+		t.Fatalf("proposal failed %v", err)
+	}
+	cmd[0] = 'x'
+	if _, err := c.SyncRead(ctx, 1, "query"); err == nil {
+		t.Fatalf("error not injected")
+	}
+	calls := c.Calls()
+	if len(calls) != 3 {
+		t.Fatalf("unexpected calls %v", calls)
+	}
+	if calls[0].Method != GetNoOPSession || calls[1].Method != SyncPropose ||
+		calls[2].Method != SyncRead {
+		t.Errorf("unexpected calls %v", calls)
+	}
+	proposals := c.CallsTo(SyncPropose)
+	if len(proposals) != 1 || string(proposals[0].Cmd) != "cmd" ||
+		proposals[0].ClientID != cs.ClientID || proposals[0].ShardID != 1 {
+		t.Errorf("unexpected proposal calls %v", proposals)
+	}
+	if calls[2].Query != "query" || !errors.Is(calls[2].Err, dragonboat.ErrTimeout) {
+		t.Errorf("unexpected read call %+v", calls[2])
+	}
+}
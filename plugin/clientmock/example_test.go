@@ -0,0 +1,79 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clientmock_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/plugin/clientmock"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// accountService is an application service layer depending on the
+// dragonboat.Client interface rather than *dragonboat.NodeHost.
+type accountService struct {
+	nh      dragonboat.Client
+	shardID uint64
+}
+
+// Deposit proposes a deposit, it is retried once when the proposal times out.
+func (s *accountService) Deposit(account string, amount int) (uint64, error) {
+	cmd := []byte(fmt.Sprintf("deposit %s %d", account, amount))
+	var err error
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		var result sm.Result
+		result, err = s.nh.SyncPropose(ctx, s.nh.GetNoOPSession(s.shardID), cmd)
+		cancel()
+		if err == nil {
+			return result.Value, nil
+		}
+		if !errors.Is(err, dragonboat.ErrTimeout) {
+			return 0, err
+		}
+	}
+	return 0, err
+}
+
+func Example() {
+	nh := clientmock.New()
+	nh.SetShard(1, clientmock.Shard{
+		Propose: func(cmd []byte) (sm.Result, error) {
+			return sm.Result{Value: 100}, nil
+		},
+	})
+	// the first proposal times out
+	nh.Fail(clientmock.SyncPropose, 1, 1, dragonboat.ErrTimeout)
+	svc := &accountService{nh: nh, shardID: 1}
+	balance, err := svc.Deposit("alice", 100)
+	fmt.Println(balance, err)
+	for _, call := range nh.CallsTo(clientmock.SyncPropose) {
+		fmt.Printf("%s %q %v\n", call.Method, call.Cmd, call.Err)
+	}
+	// requests are rejected when the shard is not ready
+	nh.Fail(clientmock.SyncPropose, 1, 3, dragonboat.ErrShardNotReady)
+	_, err = svc.Deposit("bob", 1)
+	fmt.Println(errors.Is(err, dragonboat.ErrShardNotReady))
+	// Output:
+	// 100 <nil>
+	// SyncPropose "deposit alice 100" timeout
+	// SyncPropose "deposit alice 100" <nil>
+	// true
+}
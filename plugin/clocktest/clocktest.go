@@ -0,0 +1,234 @@
+// Copyright 2017-2020 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package clocktest provides a manually advanced clock for testing applications
+built on top of dragonboat.
+
+The Clock type implements config.Clock, it can be set as the Expert.Clock of
+NodeHostConfig so time only moves forward when the test calls Advance. All
+NodeHost timing driven by ticks, e.g. elections, request timeouts, quiesce and
+the snapshot interval, then becomes deterministic and no test has to sleep for
+timeouts to fire.
+*/
+package clocktest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+)
+
+// Clock is a config.Clock that only moves forward when Advance is called.
+type Clock struct {
+	// advanceMu serializes Advance calls
+	advanceMu sync.Mutex
+	mu        sync.Mutex
+	now       time.Time
+	seq       uint64
+	timers    []*timer
+}
+
+var _ config.Clock = (*Clock)(nil)
+
+// NewClock returns a new Clock instance with its current time set to start.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// timer is a pending ticker or a pending After channel.
+type timer struct {
+	clock  *Clock
+	seq    uint64
+	due    time.Time
+	period time.Duration
+	c      chan time.Time
+	stopC  chan struct{}
+	once   sync.Once
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *timer) Stop() {
+	t.once.Do(func() {
+		close(t.stopC)
+		t.clock.remove(t)
+	})
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker returns a new ticker delivering the current time of the clock
+// every d as the clock is advanced. It panics when d is not positive.
+func (c *Clock) NewTicker(d time.Duration) config.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return c.add(d, d)
+}
+
+// After returns a channel on which the current time of the clock is delivered
+// once the clock is advanced by d.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0).C()
+}
+
+// Tickers returns the number of tickers and After channels still pending, it
+// allows tests to wait for background goroutines to create their tickers.
+func (c *Clock) Tickers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// Advance moves the clock forward by d. Tickers and After channels due within
+// d are fired in the order of their due time, those due at the same time are
+// fired in the order of their creation. Advance blocks until each tick is
+// received or the ticker is stopped, so no tick is dropped and ticks are
+// received in the order they are fired.
+func (c *Clock) Advance(d time.Duration) {
+	c.advanceMu.Lock()
+	defer c.advanceMu.Unlock()
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		t, now, ok := c.next(target)
+		if !ok {
+			return
+		}
+		select {
+		case t.c <- now:
+		case <-t.stopC:
+		}
+	}
+}
+
+// Jump moves the clock forward by d as if all receivers are too slow to keep
+// up with their tickers. Each ticker and After channel due within d is fired
+// once at the new current time, the missed ticks are dropped in the same way
+// as time.Ticker drops ticks for slow receivers. Jump allows the clock to be
+// moved forward by hours without firing millions of ticks.
+func (c *Clock) Jump(d time.Duration) {
+	c.advanceMu.Lock()
+	defer c.advanceMu.Unlock()
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var due []*timer
+	for _, t := range c.timers {
+		if !t.due.After(now) {
+			due = append(due, t)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].due.Equal(due[j].due) {
+			return due[i].seq < due[j].seq
+		}
+		return due[i].due.Before(due[j].due)
+	})
+	for _, t := range due {
+		if t.period > 0 {
+			missed := now.Sub(t.due) / t.period
+			t.due = t.due.Add((missed + 1) * t.period)
+		} else {
+			c.removeLocked(t)
+		}
+	}
+	c.mu.Unlock()
+	for _, t := range due {
+		select {
+		case t.c <- now:
+		case <-t.stopC:
+		}
+	}
+}
+
+func (c *Clock) add(d time.Duration, period time.Duration) *timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t := &timer{
+		clock:  c,
+		seq:    c.seq,
+		due:    c.now.Add(d),
+		period: period,
+		stopC:  make(chan struct{}),
+	}
+	if period > 0 {
+		// ticks are handed over to the receiver one by one
+		t.c = make(chan time.Time)
+	} else {
+		t.c = make(chan time.Time, 1)
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *Clock) remove(t *timer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(t)
+}
+
+func (c *Clock) removeLocked(t *timer) {
+	for i, v := range c.timers {
+		if v == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+// next returns the earliest timer due no later than target and moves the
+// clock to its due time. The clock is moved to target when no such timer
+// exists.
+func (c *Clock) next(target time.Time) (*timer, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var earliest *timer
+	for _, t := range c.timers {
+		if t.due.After(target) {
+			continue
+		}
+		if earliest == nil || t.due.Before(earliest.due) ||
+			(t.due.Equal(earliest.due) && t.seq < earliest.seq) {
+			earliest = t
+		}
+	}
+	if earliest == nil {
+		if target.After(c.now) {
+			c.now = target
+		}
+		return nil, time.Time{}, false
+	}
+	if earliest.due.After(c.now) {
+		c.now = earliest.due
+	}
+	if earliest.period > 0 {
+		earliest.due = earliest.due.Add(earliest.period)
+	} else {
+		c.removeLocked(earliest)
+	}
+	return earliest, c.now, true
+}
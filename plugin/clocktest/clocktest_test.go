@@ -0,0 +1,134 @@
+// Copyright 2017-2020 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clocktest
+
+import (
+	"testing"
+	"time"
+)
+
+var testStart = time.Unix(1000, 0)
+
+func TestAdvanceMovesTime(t *testing.T) {
+	c := NewClock(testStart)
+	c.Advance(time.Second)
+	if !c.Now().Equal(testStart.Add(time.Second)) {
+		t.Errorf("unexpected time %v", c.Now())
+	}
+}
+
+func TestAfterFiresOnceDue(t *testing.T) {
+	c := NewClock(testStart)
+	ch := c.After(time.Second)
+	c.Advance(999 * time.Millisecond)
+	select {
+	case <-ch:
+		t.Fatalf("fired early")
+	default:
+	}
+	c.Advance(time.Millisecond)
+	select {
+	case v := <-ch:
+		if !v.Equal(testStart.Add(time.Second)) {
+			t.Errorf("unexpected time %v", v)
+		}
+	default:
+		t.Fatalf("not fired")
+	}
+	if c.Tickers() != 0 {
+		t.Errorf("fired After not removed")
+	}
+}
+
+func TestTicksAreFiredInOrder(t *testing.T) {
+	c := NewClock(testStart)
+	t1 := c.NewTicker(2 * time.Second)
+	t2 := c.NewTicker(3 * time.Second)
+	defer t1.Stop()
+	defer t2.Stop()
+	type tick struct {
+		id      int
+		seconds int
+	}
+	var ticks []tick
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			select {
+			case v := <-t1.C():
+				ticks = append(ticks, tick{1, int(v.Sub(testStart).Seconds())})
+			case v := <-t2.C():
+				ticks = append(ticks, tick{2, int(v.Sub(testStart).Seconds())})
+			}
+		}
+	}()
+	c.Advance(6 * time.Second)
+	<-done
+	// ticks due at the same time are fired in the order of creation
+	want := []tick{{1, 2}, {2, 3}, {1, 4}, {1, 6}, {2, 6}}
+	if len(ticks) != len(want) {
+		t.Fatalf("unexpected ticks %v", ticks)
+	}
+	for i := range want {
+		if ticks[i] != want[i] {
+			t.Errorf("unexpected ticks %v, want %v", ticks, want)
+			break
+		}
+	}
+}
+
+func TestStoppedTickerDoesNotBlockAdvance(t *testing.T) {
+	c := NewClock(testStart)
+	ticker := c.NewTicker(time.Second)
+	ticker.Stop()
+	c.Advance(10 * time.Second)
+	select {
+	case <-ticker.C():
+		t.Errorf("stopped ticker fired")
+	default:
+	}
+	if c.Tickers() != 0 {
+		t.Errorf("stopped ticker not removed")
+	}
+}
+
+func TestJumpFiresEachTickerOnce(t *testing.T) {
+	c := NewClock(testStart)
+	ticker := c.NewTicker(time.Second)
+	defer ticker.Stop()
+	ch := c.After(time.Hour)
+	done := make(chan time.Time, 1)
+	go func() {
+		done <- <-ticker.C()
+	}()
+	c.Jump(2 * time.Hour)
+	if v := <-done; !v.Equal(testStart.Add(2 * time.Hour)) {
+		t.Errorf("unexpected tick %v", v)
+	}
+	select {
+	case <-ch:
+	default:
+		t.Fatalf("After not fired")
+	}
+	// the next tick is due one interval after the jump
+	go func() {
+		done <- <-ticker.C()
+	}()
+	c.Advance(time.Second)
+	if v := <-done; !v.Equal(testStart.Add(2*time.Hour + time.Second)) {
+		t.Errorf("unexpected tick %v", v)
+	}
+}
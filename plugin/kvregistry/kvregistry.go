@@ -0,0 +1,359 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package kvregistry implements a raftio.IRegistry backed by a simple key-value
+store, it allows NodeHost instances to discover each other without running the
+built-in gossip service.
+
+Each NodeHost instance stores a single record containing its RaftAddress,
+metadata and the views of its shards under its own key, the record is refreshed
+each time NodeHost publishes its shard views. Records not refreshed within the
+configured TTL are considered as stale and ignored. Records of all NodeHost
+instances are periodically listed and cached, lookups never access the
+key-value store.
+
+The IKV interface is intentionally minimal so adapters for services such as
+etcd or consul are thin, a MemKV implementation is provided for tests and for
+NodeHost instances running in the same process. Set a Factory instance as the
+config.NodeHostConfig.Expert.RegistryFactory field to use the registry.
+*/
+package kvregistry
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/logger"
+	"github.com/lni/dragonboat/v4/raftio"
+)
+
+var plog = logger.GetLogger("kvregistry")
+
+const (
+	// DefaultPrefix is the default prefix of keys used by the registry.
+	DefaultPrefix = "dragonboat"
+	// DefaultTTL is the default amount of time after which records not
+	// refreshed are considered as stale.
+	DefaultTTL = 10 * time.Second
+)
+
+// IKV is the key-value store interface used by the registry. Implementations
+// must be safe for concurrent use.
+type IKV interface {
+	// Put sets the value of the specified key.
+	Put(key string, value []byte) error
+	// Delete removes the specified key, it is not an error when the key does
+	// not exist.
+	Delete(key string) error
+	// List returns all key value pairs with keys having the specified prefix.
+	List(prefix string) (map[string][]byte, error)
+}
+
+// Config is the configuration of the registry.
+type Config struct {
+	// Prefix is the prefix of all keys used by the registry, NodeHost instances
+	// using the same Prefix discover each other. DefaultPrefix is used when it
+	// is empty.
+	Prefix string
+	// TTL is the amount of time after which records not refreshed are
+	// considered as stale. It should be several times larger than the
+	// config.NodeHostConfig.Expert.RegistryPublishInterval value. DefaultTTL is
+	// used when it is 0.
+	TTL time.Duration
+	// Meta is the metadata published together with the record of the NodeHost.
+	Meta []byte
+	// Tags are the tags published together with the record of the NodeHost.
+	Tags map[string]string
+	// Clock returns the current time, time.Now is used when it is not set. It
+	// is usually only set in tests.
+	Clock func() time.Time
+}
+
+func (c Config) withDefaults() Config {
+	if len(c.Prefix) == 0 {
+		c.Prefix = DefaultPrefix
+	}
+	if c.TTL == 0 {
+		c.TTL = DefaultTTL
+	}
+	if c.Clock == nil {
+		c.Clock = time.Now
+	}
+	return c
+}
+
+// record is the value stored by each NodeHost instance.
+type record struct {
+	RaftAddress string             `json:"raft_address"`
+	Meta        []byte             `json:"meta,omitempty"`
+	Tags        map[string]string  `json:"tags,omitempty"`
+	UpdatedAt   int64              `json:"updated_at"`
+	Shards      []raftio.ShardView `json:"shards,omitempty"`
+}
+
+// Factory creates Registry instances, it implements the
+// config.RegistryFactory interface.
+type Factory struct {
+	kv  IKV
+	cfg Config
+}
+
+var _ config.RegistryFactory = (*Factory)(nil)
+
+// NewFactory creates a new Factory instance. All registries created by the
+// returned Factory use the specified IKV instance.
+func NewFactory(kv IKV, cfg Config) *Factory {
+	return &Factory{kv: kv, cfg: cfg}
+}
+
+// Create creates a Registry instance for the specified NodeHost.
+func (f *Factory) Create(nhConfig config.NodeHostConfig,
+	nhid string) (raftio.IRegistry, error) {
+	return New(f.kv, nhid, nhConfig.RaftAddress, f.cfg)
+}
+
+// Registry is a raftio.IRegistry implementation backed by an IKV instance.
+type Registry struct {
+	kv          IKV
+	cfg         Config
+	nhid        string
+	raftAddress string
+	// publishMu serializes publishes
+	publishMu sync.Mutex
+	mu        struct {
+		sync.RWMutex
+		nodeHosts map[string]raftio.NodeHostInfo
+		shards    map[uint64]raftio.ShardView
+	}
+}
+
+var _ raftio.IRegistry = (*Registry)(nil)
+
+// New creates a new Registry instance for the specified NodeHost. The record
+// of the NodeHost is published before New returns.
+func New(kv IKV, nhid string,
+	raftAddress string, cfg Config) (*Registry, error) {
+	r := &Registry{
+		kv:          kv,
+		cfg:         cfg.withDefaults(),
+		nhid:        nhid,
+		raftAddress: raftAddress,
+	}
+	r.mu.nodeHosts = make(map[string]raftio.NodeHostInfo)
+	r.mu.shards = make(map[uint64]raftio.ShardView)
+	if err := r.Publish(nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Registry) getKey(nhid string) string {
+	return fmt.Sprintf("%s/nodehost/%s", r.cfg.Prefix, nhid)
+}
+
+func (r *Registry) getNodeHostID(key string) string {
+	return strings.TrimPrefix(key, r.getKey(""))
+}
+
+// Publish refreshes the record of the local NodeHost with the specified shard
+// views, records of all NodeHost instances are then reloaded from the IKV
+// instance. Cached records are kept unchanged when the IKV instance fails.
+func (r *Registry) Publish(shards []raftio.ShardView) error {
+	r.publishMu.Lock()
+	defer r.publishMu.Unlock()
+	data, err := json.Marshal(record{
+		RaftAddress: r.raftAddress,
+		Meta:        r.cfg.Meta,
+		Tags:        r.cfg.Tags,
+		UpdatedAt:   r.cfg.Clock().UnixNano(),
+		Shards:      shards,
+	})
+	if err != nil {
+		return err
+	}
+	if err := r.kv.Put(r.getKey(r.nhid), data); err != nil {
+		return errors.Wrapf(err, "failed to publish %s", r.nhid)
+	}
+	return r.refresh()
+}
+
+func (r *Registry) refresh() error {
+	kvs, err := r.kv.List(r.getKey(""))
+	if err != nil {
+		return errors.Wrapf(err, "failed to list records")
+	}
+	now := r.cfg.Clock()
+	nodeHosts := make(map[string]raftio.NodeHostInfo, len(kvs))
+	shards := make(map[uint64]raftio.ShardView)
+	for k, v := range kvs {
+		nhid := r.getNodeHostID(k)
+		var rec record
+		if err := json.Unmarshal(v, &rec); err != nil {
+			plog.Warningf("invalid record of %s, %v", nhid, err)
+			continue
+		}
+		if nhid != r.nhid && now.Sub(time.Unix(0, rec.UpdatedAt)) > r.cfg.TTL {
+			continue
+		}
+		nodeHosts[nhid] = raftio.NodeHostInfo{
+			NodeHostID:  nhid,
+			RaftAddress: rec.RaftAddress,
+			Meta:        rec.Meta,
+			Tags:        rec.Tags,
+		}
+		for _, sv := range rec.Shards {
+			current, ok := shards[sv.ShardID]
+			if !ok {
+				current = raftio.ShardView{ShardID: sv.ShardID}
+			}
+			shards[sv.ShardID] = mergeShardView(current, sv)
+		}
+	}
+	r.mu.Lock()
+	r.mu.nodeHosts = nodeHosts
+	r.mu.shards = shards
+	r.mu.Unlock()
+	return nil
+}
+
+// mergeShardView merges views of the same shard published by different
+// NodeHost instances, it follows the rules used by the gossip service.
+func mergeShardView(current raftio.ShardView,
+	update raftio.ShardView) raftio.ShardView {
+	if current.ConfigChangeIndex < update.ConfigChangeIndex {
+		current.Replicas = update.Replicas
+		current.NonVotings = update.NonVotings
+		current.Witnesses = update.Witnesses
+		current.ConfigChangeIndex = update.ConfigChangeIndex
+	}
+	if update.LeaderID != 0 {
+		if current.LeaderID == 0 || update.Term > current.Term {
+			current.LeaderID = update.LeaderID
+			current.Term = update.Term
+		}
+	}
+	return current
+}
+
+// GetNodeHost returns the NodeHostInfo of the specified NodeHost instance.
+func (r *Registry) GetNodeHost(nhid string) (raftio.NodeHostInfo, bool) {
+	if nhid == r.nhid {
+		return raftio.NodeHostInfo{
+			NodeHostID:  nhid,
+			RaftAddress: r.raftAddress,
+			Meta:        r.cfg.Meta,
+			Tags:        r.cfg.Tags,
+		}, true
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	nh, ok := r.mu.nodeHosts[nhid]
+	return nh, ok
+}
+
+// NodeHosts returns the NodeHostInfo of all known NodeHost instances sorted
+// by their NodeHostID values.
+func (r *Registry) NodeHosts() []raftio.NodeHostInfo {
+	r.mu.RLock()
+	result := make([]raftio.NodeHostInfo, 0, len(r.mu.nodeHosts))
+	for _, nh := range r.mu.nodeHosts {
+		result = append(result, nh)
+	}
+	r.mu.RUnlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].NodeHostID < result[j].NodeHostID
+	})
+	return result
+}
+
+// GetShardView returns the view of the specified shard.
+func (r *Registry) GetShardView(shardID uint64) (raftio.ShardView, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sv, ok := r.mu.shards[shardID]
+	if !ok {
+		return raftio.ShardView{}, false
+	}
+	replicas := make(map[uint64]string, len(sv.Replicas))
+	for replicaID, target := range sv.Replicas {
+		replicas[replicaID] = target
+	}
+	sv.Replicas = replicas
+	return sv, true
+}
+
+// NumOfShards returns the number of known shards.
+func (r *Registry) NumOfShards() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.mu.shards)
+}
+
+// Close removes the record of the local NodeHost from the IKV instance.
+func (r *Registry) Close() error {
+	r.publishMu.Lock()
+	defer r.publishMu.Unlock()
+	return r.kv.Delete(r.getKey(r.nhid))
+}
+
+// MemKV is an in-memory IKV implementation. A MemKV instance can be shared by
+// NodeHost instances running in the same process.
+type MemKV struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+var _ IKV = (*MemKV)(nil)
+
+// NewMemKV creates a new MemKV instance.
+func NewMemKV() *MemKV {
+	return &MemKV{data: make(map[string][]byte)}
+}
+
+// Put sets the value of the specified key.
+func (kv *MemKV) Put(key string, value []byte) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.data[key] = append([]byte(nil), value...)
+	return nil
+}
+
+// Delete removes the specified key.
+func (kv *MemKV) Delete(key string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	delete(kv.data, key)
+	return nil
+}
+
+// List returns all key value pairs with keys having the specified prefix.
+func (kv *MemKV) List(prefix string) (map[string][]byte, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	result := make(map[string][]byte)
+	for k, v := range kv.data {
+		if strings.HasPrefix(k, prefix) {
+			result[k] = append([]byte(nil), v...)
+		}
+	}
+	return result, nil
+}
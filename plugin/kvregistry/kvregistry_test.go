@@ -0,0 +1,124 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvregistry
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/plugin/registrytest"
+	"github.com/lni/dragonboat/v4/raftio"
+)
+
+// testClock is a clock that only advances when told to.
+type testClock struct {
+	now int64
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Now().UnixNano()}
+}
+
+func (c *testClock) get() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.now))
+}
+
+func (c *testClock) advance(d time.Duration) {
+	atomic.AddInt64(&c.now, int64(d))
+}
+
+func TestConformance(t *testing.T) {
+	registrytest.Run(t, func(t *testing.T) registrytest.Harness {
+		kv := NewMemKV()
+		clock := newTestClock()
+		return registrytest.Harness{
+			Create: func(nhid string,
+				raftAddress string, meta []byte) (raftio.IRegistry, error) {
+				return New(kv, nhid, raftAddress, Config{Meta: meta, Clock: clock.get})
+			},
+			Expire: func() { clock.advance(DefaultTTL + time.Second) },
+		}
+	})
+}
+
+func TestRecordsWithDifferentPrefixAreIgnored(t *testing.T) {
+	kv := NewMemKV()
+	r1, err := New(kv, "nh1", "localhost:9001", Config{Prefix: "p1"})
+	if err != nil {
+		t.Fatalf("failed to create registry %v", err)
+	}
+	r2, err := New(kv, "nh2", "localhost:9002", Config{Prefix: "p2"})
+	if err != nil {
+		t.Fatalf("failed to create registry %v", err)
+	}
+	for _, r := range []*Registry{r1, r2} {
+		if err := r.Publish(nil); err != nil {
+			t.Fatalf("failed to publish %v", err)
+		}
+		if n := len(r.NodeHosts()); n != 1 {
+			t.Errorf("unexpected NodeHost count %d", n)
+		}
+	}
+}
+
+type failingKV struct {
+	*MemKV
+	failed bool
+}
+
+func (kv *failingKV) List(prefix string) (map[string][]byte, error) {
+	if kv.failed {
+		return nil, errors.New("unavailable")
+	}
+	return kv.MemKV.List(prefix)
+}
+
+func TestCachedRecordsAreKeptWhenKVFails(t *testing.T) {
+	kv := &failingKV{MemKV: NewMemKV()}
+	if _, err := New(kv, "nh2", "localhost:9002", Config{}); err != nil {
+		t.Fatalf("failed to create registry %v", err)
+	}
+	r, err := New(kv, "nh1", "localhost:9001", Config{})
+	if err != nil {
+		t.Fatalf("failed to create registry %v", err)
+	}
+	kv.failed = true
+	if err := r.Publish(nil); err == nil {
+		t.Fatalf("failure not reported")
+	}
+	if nh, ok := r.GetNodeHost("nh2"); !ok || nh.RaftAddress != "localhost:9002" {
+		t.Errorf("cached record lost, %+v", nh)
+	}
+}
+
+func TestInvalidRecordIsIgnored(t *testing.T) {
+	kv := NewMemKV()
+	if err := kv.Put(DefaultPrefix+"/nodehost/nh2", []byte("invalid")); err != nil {
+		t.Fatalf("put failed %v", err)
+	}
+	r, err := New(kv, "nh1", "localhost:9001", Config{})
+	if err != nil {
+		t.Fatalf("failed to create registry %v", err)
+	}
+	if _, ok := r.GetNodeHost("nh2"); ok {
+		t.Errorf("invalid record not ignored")
+	}
+	if n := len(r.NodeHosts()); n != 1 {
+		t.Errorf("unexpected NodeHost count %d", n)
+	}
+}
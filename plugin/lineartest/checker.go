@@ -0,0 +1,306 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lineartest
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// Operation is a completed or ambiguous client operation in a history.
+type Operation struct {
+	// ClientID is the ID of the client goroutine that issued the operation.
+	ClientID int
+	// Input is the operation as issued, e.g. a KVInput.
+	Input interface{}
+	// Output is the observed result, e.g. a KVOutput. It is ignored for
+	// ambiguous operations.
+	Output interface{}
+	// Call is the invocation time in nanoseconds since the start of the run.
+	Call int64
+	// Return is the response time in nanoseconds since the start of the run.
+	Return int64
+	// Ambiguous indicates that the outcome of the operation is unknown, e.g.
+	// the proposal timed out. Ambiguous operations may take effect at any point
+	// after their invocation or never take effect at all.
+	Ambiguous bool
+}
+
+// Model is a sequential specification of the system under test.
+type Model struct {
+	// Partition optionally splits a history into independent sub-histories
+	// that can be checked separately, e.g. one per key of a KV store. The
+	// whole history is linearizable if and only if each sub-history is.
+	Partition func(history []Operation) [][]Operation
+	// Init returns the initial state.
+	Init func() interface{}
+	// Step applies the input to the state, it returns whether the output is
+	// valid for the input in that state and the resulting state. Step must not
+	// modify the specified state.
+	Step func(state interface{},
+		input interface{}, output interface{}) (bool, interface{})
+	// Equal optionally reports whether two states are equal, states are
+	// compared using == when it is not set.
+	Equal func(a interface{}, b interface{}) bool
+}
+
+// CheckResult is the outcome of a linearizability check.
+type CheckResult int
+
+const (
+	// Ok means that the history is linearizable.
+	Ok CheckResult = iota
+	// Illegal means that the history is not linearizable.
+	Illegal
+	// Unknown means that the check timed out.
+	Unknown
+)
+
+func (r CheckResult) String() string {
+	switch r {
+	case Ok:
+		return "Ok"
+	case Illegal:
+		return "Illegal"
+	case Unknown:
+		return "Unknown"
+	}
+	return "CheckResult(?)"
+}
+
+// Check checks whether the history is linearizable with respect to the
+// model. The history is first split into independent sub-histories using
+// the Partition function of the model, each sub-history is then checked using
+// the Wing & Gong search with the state caching suggested by Lowe. A timeout
+// of 0 means no timeout. On Illegal or Unknown results, the sub-history that
+// failed the check is also returned.
+func Check(model Model,
+	history []Operation, timeout time.Duration) (CheckResult, []Operation) {
+	partitions := [][]Operation{history}
+	if model.Partition != nil {
+		partitions = model.Partition(history)
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for _, p := range partitions {
+		if r := checkPartition(model, p, deadline); r != Ok {
+			return r, p
+		}
+	}
+	return Ok, nil
+}
+
+type entry struct {
+	call  bool
+	value interface{}
+	id    int
+	time  int64
+}
+
+func makeEntries(history []Operation) []entry {
+	entries := make([]entry, 0, 2*len(history))
+	for id, op := range history {
+		ret := op.Return
+		if op.Ambiguous {
+			ret = math.MaxInt64
+		}
+		entries = append(entries,
+			entry{call: true, value: op.Input, id: id, time: op.Call},
+			entry{value: op.Output, id: id, time: ret})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].time != entries[j].time {
+			return entries[i].time < entries[j].time
+		}
+		// calls are ordered before returns with the same timestamp so such
+		// operations are considered to be concurrent
+		return entries[i].call && !entries[j].call
+	})
+	return entries
+}
+
+// node is an element of the doubly linked list of entries, a call node points
+// to its matching return node.
+type node struct {
+	value interface{}
+	match *node
+	id    int
+	next  *node
+	prev  *node
+}
+
+func insertBefore(n *node, mark *node) {
+	if mark != nil {
+		before := mark.prev
+		mark.prev = n
+		n.next = mark
+		if before != nil {
+			n.prev = before
+			before.next = n
+		}
+	}
+}
+
+func makeLinkedEntries(entries []entry) *node {
+	var root *node
+	returns := make(map[int]*node)
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		n := &node{value: e.value, id: e.id}
+		if e.call {
+			n.match = returns[e.id]
+		} else {
+			returns[e.id] = n
+		}
+		insertBefore(n, root)
+		root = n
+	}
+	head := &node{id: -1}
+	insertBefore(head, root)
+	return head
+}
+
+// lift removes the call node and its matching return node from the list.
+func lift(n *node) {
+	n.prev.next = n.next
+	n.next.prev = n.prev
+	m := n.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+// unlift puts back the call node and its matching return node removed by
+// lift.
+func unlift(n *node) {
+	m := n.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	n.prev.next = n
+	n.next.prev = n
+}
+
+type bitset []uint64
+
+func newBitset(size int) bitset {
+	return make(bitset, (size+63)/64)
+}
+
+func (b bitset) set(pos int) {
+	b[pos/64] |= 1 << uint(pos%64)
+}
+
+func (b bitset) clear(pos int) {
+	b[pos/64] &^= 1 << uint(pos%64)
+}
+
+func (b bitset) clone() bitset {
+	return append(bitset(nil), b...)
+}
+
+func (b bitset) equal(o bitset) bool {
+	for i := range b {
+		if b[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	h := uint64(len(b))
+	for _, v := range b {
+		h = bits.RotateLeft64(h, 13) ^ v
+		h *= 0x9e3779b97f4a7c15
+	}
+	return h
+}
+
+type cacheEntry struct {
+	linearized bitset
+	state      interface{}
+}
+
+type callsEntry struct {
+	n     *node
+	state interface{}
+}
+
+func checkPartition(model Model,
+	history []Operation, deadline time.Time) CheckResult {
+	equal := model.Equal
+	if equal == nil {
+		equal = func(a interface{}, b interface{}) bool { return a == b }
+	}
+	head := makeLinkedEntries(makeEntries(history))
+	state := model.Init()
+	linearized := newBitset(len(history))
+	cache := make(map[uint64][]cacheEntry)
+	var calls []callsEntry
+	n := head.next
+	for iter := 0; head.next != nil; iter++ {
+		if !deadline.IsZero() && iter%1024 == 0 && time.Now().After(deadline) {
+			return Unknown
+		}
+		if n.match != nil {
+			ok, newState := model.Step(state, n.value, n.match.value)
+			if ok {
+				l := linearized.clone()
+				l.set(n.id)
+				if !cached(cache, l, newState, equal) {
+					h := l.hash()
+					cache[h] = append(cache[h], cacheEntry{l, newState})
+					calls = append(calls, callsEntry{n, state})
+					state = newState
+					linearized.set(n.id)
+					lift(n)
+					n = head.next
+					continue
+				}
+			}
+			n = n.next
+		} else {
+			// a return node is reached before its call could be linearized,
+			// backtrack
+			if len(calls) == 0 {
+				return Illegal
+			}
+			top := calls[len(calls)-1]
+			calls = calls[:len(calls)-1]
+			n, state = top.n, top.state
+			linearized.clear(n.id)
+			unlift(n)
+			n = n.next
+		}
+	}
+	return Ok
+}
+
+func cached(cache map[uint64][]cacheEntry, linearized bitset,
+	state interface{}, equal func(interface{}, interface{}) bool) bool {
+	for _, e := range cache[linearized.hash()] {
+		if linearized.equal(e.linearized) && equal(state, e.state) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lineartest
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// KVInput is the input of an operation on the KV store.
+type KVInput struct {
+	// Put indicates that the operation sets the value of the key, it is a get
+	// operation otherwise.
+	Put   bool
+	Key   string
+	Value string
+}
+
+// KVOutput is the output of an operation on the KV store.
+type KVOutput struct {
+	// Value is the value returned by a get operation.
+	Value string
+}
+
+// KVModel is the Model of a KV store supporting put and get operations. Its
+// histories are partitioned by key, each key is checked as an independent
+// register. A register is modelled as a KV store with a single key.
+//
+// Ambiguous puts with values never returned by any get on the same key are
+// removed when partitioning the history. Such a put can always be considered
+// as never taking effect, removing it keeps the search space manageable when
+// many proposals time out during partitions.
+var KVModel = Model{
+	Partition: func(history []Operation) [][]Operation {
+		type kv struct {
+			key   string
+			value string
+		}
+		observed := make(map[kv]struct{})
+		for _, op := range history {
+			if in := op.Input.(KVInput); !in.Put {
+				observed[kv{in.Key, op.Output.(KVOutput).Value}] = struct{}{}
+			}
+		}
+		byKey := make(map[string][]Operation)
+		var keys []string
+		for _, op := range history {
+			in := op.Input.(KVInput)
+			if op.Ambiguous {
+				if _, ok := observed[kv{in.Key, in.Value}]; !ok {
+					continue
+				}
+			}
+			if _, ok := byKey[in.Key]; !ok {
+				keys = append(keys, in.Key)
+			}
+			byKey[in.Key] = append(byKey[in.Key], op)
+		}
+		result := make([][]Operation, 0, len(keys))
+		for _, key := range keys {
+			result = append(result, byKey[key])
+		}
+		return result
+	},
+	Init: func() interface{} {
+		return ""
+	},
+	Step: func(state interface{},
+		input interface{}, output interface{}) (bool, interface{}) {
+		in := input.(KVInput)
+		if in.Put {
+			return true, in.Value
+		}
+		out, ok := output.(KVOutput)
+		return ok && out.Value == state.(string), state
+	},
+}
+
+// kvStateMachine is the sm.IStateMachine used by Run. Each proposal sets a
+// key, each lookup query is a key.
+type kvStateMachine struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+var _ sm.IStateMachine = (*kvStateMachine)(nil)
+
+func newKVStateMachine(shardID uint64, replicaID uint64) sm.IStateMachine {
+	return &kvStateMachine{data: make(map[string]string)}
+}
+
+func encodePut(key string, value string) []byte {
+	return []byte(key + "=" + value)
+}
+
+func (s *kvStateMachine) Update(e sm.Entry) (sm.Result, error) {
+	parts := strings.SplitN(string(e.Cmd), "=", 2)
+	if len(parts) != 2 {
+		return sm.Result{}, errors.Errorf("invalid cmd %q", e.Cmd)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[parts[0]] = parts[1]
+	return sm.Result{Value: e.Index}, nil
+}
+
+func (s *kvStateMachine) Lookup(query interface{}) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data[query.(string)], nil
+}
+
+func (s *kvStateMachine) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.NewEncoder(w).Encode(s.data)
+}
+
+func (s *kvStateMachine) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	data := make(map[string]string)
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = data
+	return nil
+}
+
+func (s *kvStateMachine) Close() error {
+	return nil
+}
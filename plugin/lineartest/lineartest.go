@@ -0,0 +1,554 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package lineartest verifies that SyncPropose and SyncRead are linearizable
+under network partitions and leader changes.
+
+The Run function starts a KV state machine on a number of in-process NodeHost
+instances connected by the memtransport, injects faults according to a
+schedule and has concurrent clients issue put and get requests. Invocations
+and responses of all requests are recorded into a history, proposals with
+unknown outcomes, e.g. those failed with ErrTimeout, are recorded as
+ambiguous operations. The history is then checked by a bundled P-compositional
+linearizability checker using the KVModel.
+*/
+package lineartest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+)
+
+const (
+	shardID = uint64(1)
+)
+
+// FaultKind is the type of faults injected into the cluster.
+type FaultKind int
+
+const (
+	// Heal removes all network partitions.
+	Heal FaultKind = iota
+	// Partition splits the network into the groups of NodeHosts specified in
+	// Fault.Groups.
+	Partition
+	// IsolateLeader partitions the current leader away from all other
+	// NodeHosts. Clients connected to the isolated leader keep issuing
+	// requests to it.
+	IsolateLeader
+	// TransferLeader requests the leadership to be transferred to the
+	// replica specified in Fault.Target.
+	TransferLeader
+)
+
+func (k FaultKind) String() string {
+	switch k {
+	case Heal:
+		return "Heal"
+	case Partition:
+		return "Partition"
+	case IsolateLeader:
+		return "IsolateLeader"
+	case TransferLeader:
+		return "TransferLeader"
+	}
+	return "FaultKind(?)"
+}
+
+// Fault is a fault injected into the cluster at a point of time.
+type Fault struct {
+	// At is the time since the start of the run at which the fault is
+	// injected.
+	At   time.Duration
+	Kind FaultKind
+	// Groups are the groups of NodeHosts for Partition faults, NodeHosts are
+	// identified by their 1-based index which is also the replica ID of their
+	// replicas.
+	Groups [][]int
+	// Target is the replica ID of the new leader for TransferLeader faults.
+	Target uint64
+}
+
+// RandomSchedule returns a randomized fault schedule for the specified
+// number of NodeHosts. A fault is injected every interval until duration,
+// every partition or leader isolation is followed by a heal.
+func RandomSchedule(seed int64, nodeHosts int,
+	duration time.Duration, interval time.Duration) []Fault {
+	r := rand.New(rand.NewSource(seed))
+	var faults []Fault
+	partitioned := false
+	for at := interval; at < duration; at += interval {
+		f := Fault{At: at}
+		if partitioned {
+			f.Kind = Heal
+			partitioned = false
+		} else {
+			switch r.Intn(3) {
+			case 0:
+				f.Kind = Partition
+				perm := r.Perm(nodeHosts)
+				split := 1 + r.Intn(nodeHosts-1)
+				var a, b []int
+				for i, idx := range perm {
+					if i < split {
+						a = append(a, idx+1)
+					} else {
+						b = append(b, idx+1)
+					}
+				}
+				f.Groups = [][]int{a, b}
+				partitioned = true
+			case 1:
+				f.Kind = IsolateLeader
+				partitioned = true
+			case 2:
+				f.Kind = TransferLeader
+				f.Target = uint64(1 + r.Intn(nodeHosts))
+			}
+		}
+		faults = append(faults, f)
+	}
+	return faults
+}
+
+// Config is the configuration of a Run.
+type Config struct {
+	// Dir is the directory in which NodeHost directories are created.
+	Dir string
+	// NodeHosts is the number of NodeHosts, each running a replica of the
+	// shard. It defaults to 3.
+	NodeHosts int
+	// Clients is the number of concurrent clients, the i-th client sends its
+	// requests to the (i mod NodeHosts)-th NodeHost. It defaults to 4.
+	Clients int
+	// Keys is the number of keys accessed by clients. It defaults to 3.
+	Keys int
+	// Duration is the duration of the run.
+	Duration time.Duration
+	// Seed is the seed of all randomized decisions made by clients. Timing
+	// still varies between runs.
+	Seed int64
+	// RTTMillisecond is the RTTMillisecond of all NodeHosts. It defaults
+	// to 5.
+	RTTMillisecond uint64
+	// RequestTimeout is the timeout of each request. It defaults to 50 RTTs.
+	RequestTimeout time.Duration
+	// Sessions indicates whether proposals are made using client sessions
+	// registered by SyncGetSession rather than NO-OP sessions. With client
+	// sessions, proposals with ambiguous outcomes are retried using the same
+	// session until they complete or the run ends.
+	Sessions bool
+	// Faults is the fault schedule, faults are injected in order. All
+	// partitions are healed at the end of the run.
+	Faults []Fault
+	// ClockSkew is the maximum relative skew, in the range of [0, 1), of the
+	// tick rate of each NodeHost's Expert.Clock. It lets election and check
+	// quorum timeouts elapse at different rates on different NodeHosts. Note
+	// that reads are never served from leader leases, SyncRead always confirms
+	// the leadership using ReadIndex, so a correct implementation stays
+	// linearizable regardless of the skew.
+	ClockSkew float64
+}
+
+func (c *Config) prepare() error {
+	if len(c.Dir) == 0 {
+		return errors.New("Dir not set")
+	}
+	if c.Duration <= 0 {
+		return errors.New("Duration not set")
+	}
+	if c.ClockSkew < 0 || c.ClockSkew >= 1 {
+		return errors.Errorf("invalid ClockSkew %f", c.ClockSkew)
+	}
+	if c.NodeHosts == 0 {
+		c.NodeHosts = 3
+	}
+	if c.Clients == 0 {
+		c.Clients = 4
+	}
+	if c.Keys == 0 {
+		c.Keys = 3
+	}
+	if c.RTTMillisecond == 0 {
+		c.RTTMillisecond = 5
+	}
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = 50 * time.Duration(c.RTTMillisecond) * time.Millisecond
+	}
+	return nil
+}
+
+// Result is the result of a Run.
+type Result struct {
+	// History is the recorded history of all clients.
+	History []Operation
+	// Ambiguous is the number of ambiguous operations in the history.
+	Ambiguous int
+	// FailedReads is the number of failed get operations, they are not
+	// included in the history as they have no effect.
+	FailedReads int
+}
+
+// skewedClock is a config.Clock with the periods of its tickers and timers
+// scaled by rate.
+type skewedClock struct {
+	config.Clock
+	rate float64
+}
+
+func (c skewedClock) scale(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * c.rate)
+}
+
+func (c skewedClock) NewTicker(d time.Duration) config.Ticker {
+	return c.Clock.NewTicker(c.scale(d))
+}
+
+func (c skewedClock) After(d time.Duration) <-chan time.Time {
+	return c.Clock.After(c.scale(d))
+}
+
+// Run runs the clients against a newly created cluster as specified in cfg
+// and returns the recorded history.
+func Run(cfg Config) (Result, error) {
+	if err := cfg.prepare(); err != nil {
+		return Result{}, err
+	}
+	r := rand.New(rand.NewSource(cfg.Seed))
+	network := memtransport.NewNetwork()
+	nhConfigs := network.NodeHostConfigs(cfg.NodeHosts,
+		cfg.Dir, cfg.RTTMillisecond)
+	members := make(map[uint64]dragonboat.Target)
+	for i := 1; i <= cfg.NodeHosts; i++ {
+		members[uint64(i)] = memtransport.Address(i)
+	}
+	nhs := make([]*dragonboat.NodeHost, 0, cfg.NodeHosts)
+	defer func() {
+		for _, nh := range nhs {
+			nh.Close()
+		}
+	}()
+	for i, nhc := range nhConfigs {
+		if err := os.MkdirAll(nhc.NodeHostDir, 0755); err != nil {
+			return Result{}, err
+		}
+		nhc.Expert.LogDB = config.GetTinyMemLogDBConfig()
+		if cfg.ClockSkew > 0 {
+			rate := 1 + cfg.ClockSkew*(2*r.Float64()-1)
+			nhc.Expert.Clock = skewedClock{Clock: config.DefaultClock, rate: rate}
+		}
+		nh, err := dragonboat.NewNodeHost(nhc)
+		if err != nil {
+			return Result{}, err
+		}
+		nhs = append(nhs, nh)
+		rc := config.Config{
+			ShardID:            shardID,
+			ReplicaID:          uint64(i + 1),
+			ElectionRTT:        10,
+			HeartbeatRTT:       1,
+			CheckQuorum:        true,
+			SnapshotEntries:    100,
+			CompactionOverhead: 50,
+		}
+		if err := nh.StartReplica(members, false, newKVStateMachine, rc); err != nil {
+			return Result{}, err
+		}
+	}
+	if err := waitForLeader(nhs, cfg.RequestTimeout*20); err != nil {
+		return Result{}, err
+	}
+	rec := &recorder{start: time.Now()}
+	stopC := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Clients; i++ {
+		c := &kvClient{
+			id:    i,
+			nh:    nhs[i%len(nhs)],
+			cfg:   cfg,
+			rand:  rand.New(rand.NewSource(cfg.Seed + int64(i) + 1)),
+			rec:   rec,
+			stopC: stopC,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.run()
+		}()
+	}
+	inject(network, nhs, cfg.Faults, rec.start, cfg.Duration)
+	close(stopC)
+	wg.Wait()
+	network.Heal()
+	return rec.result(), nil
+}
+
+// Verify runs the clients as specified in cfg and fails the test when the
+// recorded history is not linearizable. checkTimeout is the timeout of the
+// linearizability check, 0 means no timeout.
+func Verify(t testing.TB, cfg Config, checkTimeout time.Duration) Result {
+	t.Helper()
+	result, err := Run(cfg)
+	if err != nil {
+		t.Fatalf("run failed %v", err)
+	}
+	t.Logf("%d operations recorded, %d ambiguous, %d failed reads",
+		len(result.History), result.Ambiguous, result.FailedReads)
+	r, failed := Check(KVModel, result.History, checkTimeout)
+	switch r {
+	case Illegal:
+		t.Fatalf("history not linearizable:\n%s", Describe(failed))
+	case Unknown:
+		t.Fatalf("linearizability check timed out, %d operations", len(failed))
+	}
+	return result
+}
+
+// Describe returns a human readable description of the history, one
+// operation per line ordered by invocation time.
+func Describe(history []Operation) string {
+	ops := append([]Operation(nil), history...)
+	sort.SliceStable(ops, func(i, j int) bool {
+		return ops[i].Call < ops[j].Call
+	})
+	var lines []string
+	for _, op := range ops {
+		in := op.Input.(KVInput)
+		var desc string
+		if in.Put {
+			desc = fmt.Sprintf("put(%s, %s)", in.Key, in.Value)
+		} else {
+			desc = fmt.Sprintf("get(%s) -> %s", in.Key, op.Output.(KVOutput).Value)
+		}
+		ret := fmt.Sprintf("%d", op.Return)
+		if op.Ambiguous {
+			ret = "?"
+		}
+		lines = append(lines, fmt.Sprintf("client %d [%d, %s] %s",
+			op.ClientID, op.Call, ret, desc))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func waitForLeader(nhs []*dragonboat.NodeHost, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, _, ok, err := nhs[0].GetLeaderID(shardID); err == nil && ok {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return errors.New("no leader elected")
+}
+
+// leaderIndex returns the 1-based index of the NodeHost that has the leader
+// of the latest known term, it returns 0 when no leader is known.
+func leaderIndex(nhs []*dragonboat.NodeHost) int {
+	var leaderID, maxTerm uint64
+	for _, nh := range nhs {
+		id, term, ok, err := nh.GetLeaderID(shardID)
+		if err == nil && ok && term >= maxTerm {
+			leaderID, maxTerm = id, term
+		}
+	}
+	return int(leaderID)
+}
+
+func inject(network *memtransport.Network, nhs []*dragonboat.NodeHost,
+	faults []Fault, start time.Time, duration time.Duration) {
+	for _, f := range faults {
+		if f.At >= duration {
+			break
+		}
+		time.Sleep(time.Until(start.Add(f.At)))
+		switch f.Kind {
+		case Heal:
+			network.Heal()
+		case Partition:
+			groups := make([][]string, 0, len(f.Groups))
+			for _, g := range f.Groups {
+				addrs := make([]string, 0, len(g))
+				for _, idx := range g {
+					addrs = append(addrs, memtransport.Address(idx))
+				}
+				groups = append(groups, addrs)
+			}
+			network.Partition(groups...)
+		case IsolateLeader:
+			if idx := leaderIndex(nhs); idx > 0 {
+				network.Partition([]string{memtransport.Address(idx)})
+			}
+		case TransferLeader:
+			// failures are ignored, e.g. when there is no leader
+			_ = nhs[0].RequestLeaderTransfer(shardID, f.Target)
+		default:
+			panic(fmt.Sprintf("unknown fault kind %s", f.Kind))
+		}
+	}
+	time.Sleep(time.Until(start.Add(duration)))
+}
+
+// recorder records operations completed by all clients.
+type recorder struct {
+	start       time.Time
+	mu          sync.Mutex
+	history     []Operation
+	ambiguous   int
+	failedReads int
+}
+
+func (r *recorder) now() int64 {
+	return time.Since(r.start).Nanoseconds()
+}
+
+func (r *recorder) record(op Operation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.history = append(r.history, op)
+	if op.Ambiguous {
+		r.ambiguous++
+	}
+}
+
+func (r *recorder) failedRead() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failedReads++
+}
+
+func (r *recorder) result() Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Result{
+		History:     append([]Operation(nil), r.history...),
+		Ambiguous:   r.ambiguous,
+		FailedReads: r.failedReads,
+	}
+}
+
+type kvClient struct {
+	id      int
+	nh      *dragonboat.NodeHost
+	cfg     Config
+	rand    *rand.Rand
+	rec     *recorder
+	stopC   chan struct{}
+	session *client.Session
+	seq     int
+}
+
+func (c *kvClient) stopped() bool {
+	select {
+	case <-c.stopC:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *kvClient) run() {
+	for !c.stopped() {
+		key := fmt.Sprintf("key-%d", c.rand.Intn(c.cfg.Keys))
+		if c.rand.Intn(2) == 0 {
+			c.get(key)
+		} else {
+			c.seq++
+			c.put(key, fmt.Sprintf("c%d-%d", c.id, c.seq))
+		}
+		time.Sleep(time.Duration(c.rand.Intn(5)) * time.Millisecond)
+	}
+}
+
+func (c *kvClient) get(key string) {
+	call := c.rec.now()
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.RequestTimeout)
+	defer cancel()
+	v, err := c.nh.SyncRead(ctx, shardID, key)
+	ret := c.rec.now()
+	if err != nil {
+		c.rec.failedRead()
+		return
+	}
+	c.rec.record(Operation{
+		ClientID: c.id,
+		Input:    KVInput{Key: key},
+		Output:   KVOutput{Value: v.(string)},
+		Call:     call,
+		Return:   ret,
+	})
+}
+
+func (c *kvClient) put(key string, value string) {
+	op := Operation{
+		ClientID: c.id,
+		Input:    KVInput{Put: true, Key: key, Value: value},
+		Call:     c.rec.now(),
+	}
+	if c.cfg.Sessions {
+		op.Ambiguous = !c.sessionPropose(encodePut(key, value))
+	} else {
+		op.Ambiguous = !c.propose(c.nh.GetNoOPSession(shardID),
+			encodePut(key, value))
+	}
+	op.Output = KVOutput{}
+	op.Return = c.rec.now()
+	c.rec.record(op)
+}
+
+// propose returns a boolean value indicating whether the proposal is known to
+// have been applied.
+func (c *kvClient) propose(cs *client.Session, cmd []byte) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.RequestTimeout)
+	defer cancel()
+	_, err := c.nh.SyncPropose(ctx, cs, cmd)
+	return err == nil
+}
+
+// sessionPropose retries the proposal using the same client session until
+// it is applied or the run ends. A client session guarantees that the
+// proposal is applied at most once no matter how many times it is retried.
+func (c *kvClient) sessionPropose(cmd []byte) bool {
+	for !c.stopped() {
+		if c.session == nil {
+			ctx, cancel := context.WithTimeout(context.Background(),
+				c.cfg.RequestTimeout)
+			cs, err := c.nh.SyncGetSession(ctx, shardID)
+			cancel()
+			if err != nil {
+				continue
+			}
+			c.session = cs
+		}
+		if c.propose(c.session, cmd) {
+			c.session.ProposalCompleted()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lineartest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/logger"
+)
+
+func put(client int, key string, value string,
+	call int64, ret int64) Operation {
+	return Operation{
+		ClientID: client,
+		Input:    KVInput{Put: true, Key: key, Value: value},
+		Output:   KVOutput{},
+		Call:     call,
+		Return:   ret,
+	}
+}
+
+func get(client int, key string, value string,
+	call int64, ret int64) Operation {
+	return Operation{
+		ClientID: client,
+		Input:    KVInput{Key: key},
+		Output:   KVOutput{Value: value},
+		Call:     call,
+		Return:   ret,
+	}
+}
+
+func ambiguous(op Operation) Operation {
+	op.Ambiguous = true
+	op.Return = 0
+	return op
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		history []Operation
+		result  CheckResult
+	}{
+		{"empty", nil, Ok},
+		{"initial value", []Operation{get(0, "x", "", 0, 10)}, Ok},
+		{"sequential", []Operation{
+			put(0, "x", "1", 0, 10),
+			get(1, "x", "1", 20, 30),
+		}, Ok},
+		{"stale read", []Operation{
+			put(0, "x", "1", 0, 10),
+			put(0, "x", "2", 20, 30),
+			get(1, "x", "1", 40, 50),
+		}, Illegal},
+		{"concurrent read sees either value", []Operation{
+			put(0, "x", "1", 0, 10),
+			put(0, "x", "2", 20, 50),
+			get(1, "x", "1", 30, 40),
+			get(2, "x", "2", 30, 40),
+		}, Ok},
+		{"reads disagree on order", []Operation{
+			put(0, "x", "1", 0, 100),
+			put(1, "x", "2", 0, 100),
+			get(2, "x", "1", 10, 20),
+			get(2, "x", "2", 30, 40),
+			get(3, "x", "2", 10, 20),
+			get(3, "x", "1", 30, 40),
+		}, Illegal},
+		{"read before write", []Operation{
+			get(0, "x", "1", 0, 10),
+			put(1, "x", "1", 20, 30),
+		}, Illegal},
+		{"ambiguous put takes effect", []Operation{
+			ambiguous(put(0, "x", "1", 0, 0)),
+			get(1, "x", "1", 20, 30),
+			get(1, "x", "1", 40, 50),
+		}, Ok},
+		{"ambiguous put never takes effect", []Operation{
+			ambiguous(put(0, "x", "1", 0, 0)),
+			get(1, "x", "", 20, 30),
+		}, Ok},
+		{"ambiguous put can not be undone", []Operation{
+			ambiguous(put(0, "x", "1", 0, 0)),
+			get(1, "x", "1", 20, 30),
+			get(1, "x", "", 40, 50),
+		}, Illegal},
+		{"keys are independent", []Operation{
+			put(0, "x", "1", 0, 10),
+			put(0, "y", "2", 20, 30),
+			get(1, "x", "1", 40, 50),
+			get(1, "y", "2", 40, 50),
+		}, Ok},
+		{"unobserved ambiguous put is ignored", []Operation{
+			put(0, "x", "1", 0, 10),
+			ambiguous(put(1, "x", "2", 20, 0)),
+			get(2, "x", "1", 30, 40),
+		}, Ok},
+		{"one illegal key fails the history", []Operation{
+			put(0, "x", "1", 0, 10),
+			put(0, "y", "2", 20, 30),
+			get(1, "x", "1", 40, 50),
+			get(1, "y", "", 40, 50),
+		}, Illegal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, failed := Check(KVModel, tt.history, 0)
+			if r != tt.result {
+				t.Fatalf("got %s, want %s", r, tt.result)
+			}
+			if r == Ok && failed != nil {
+				t.Errorf("unexpected failed history")
+			}
+			if r == Illegal && len(failed) == 0 {
+				t.Errorf("failed history not returned")
+			}
+		})
+	}
+}
+
+func TestCheckCanTimeout(t *testing.T) {
+	// many concurrent ambiguous puts followed by an impossible read requires
+	// all subsets of the puts to be explored, the KVModel would have pruned
+	// such puts as their values are never observed
+	model := Model{Init: KVModel.Init, Step: KVModel.Step}
+	var history []Operation
+	for i := 0; i < 64; i++ {
+		history = append(history,
+			ambiguous(put(i, "x", fmt.Sprintf("v%d", i), 0, 0)))
+	}
+	history = append(history, get(100, "x", "missing", 10, 20))
+	r, _ := Check(model, history, time.Millisecond)
+	if r != Unknown {
+		t.Fatalf("got %s", r)
+	}
+}
+
+func TestRandomSchedule(t *testing.T) {
+	faults := RandomSchedule(1, 3, 10*time.Second, time.Second)
+	if len(faults) != 9 {
+		t.Fatalf("got %d faults, want 9", len(faults))
+	}
+	partitioned := false
+	for i, f := range faults {
+		if f.At != time.Duration(i+1)*time.Second {
+			t.Errorf("fault %d at %s", i, f.At)
+		}
+		if partitioned && f.Kind != Heal {
+			t.Errorf("fault %d is %s, want Heal", i, f.Kind)
+		}
+		partitioned = f.Kind == Partition || f.Kind == IsolateLeader
+		if f.Kind == Partition && len(f.Groups[0])+len(f.Groups[1]) != 3 {
+			t.Errorf("unexpected groups %v", f.Groups)
+		}
+	}
+	again := RandomSchedule(1, 3, 10*time.Second, time.Second)
+	for i := range faults {
+		if faults[i].Kind != again[i].Kind ||
+			faults[i].Target != again[i].Target {
+			t.Fatalf("schedule not deterministic")
+		}
+	}
+}
+
+func setLogLevels() func() {
+	names := []string{"dragonboat", "raft", "rsm", "transport", "logdb",
+		"config", "registry"}
+	for _, name := range names {
+		logger.GetLogger(name).SetLevel(logger.ERROR)
+	}
+	return func() {
+		for _, name := range names {
+			logger.GetLogger(name).SetLevel(logger.INFO)
+		}
+	}
+}
+
+func TestSyncProposeAndSyncReadAreLinearizable(t *testing.T) {
+	defer setLogLevels()()
+	duration := 60 * time.Second
+	if testing.Short() {
+		duration = 10 * time.Second
+	}
+	for _, sessions := range []bool{false, true} {
+		cfg := Config{
+			Dir:       t.TempDir(),
+			NodeHosts: 3,
+			Clients:   6,
+			Keys:      3,
+			Duration:  duration / 2,
+			Seed:      1,
+			Sessions:  sessions,
+			Faults: RandomSchedule(1, 3,
+				duration/2, 500*time.Millisecond),
+			ClockSkew: 0.2,
+		}
+		result := Verify(t, cfg, time.Minute)
+		if len(result.History) == 0 {
+			t.Fatalf("no operation recorded")
+		}
+	}
+}
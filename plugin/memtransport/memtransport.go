@@ -0,0 +1,456 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package memtransport implements an in-process transport module for testing
+applications built on top of dragonboat.
+
+All NodeHost instances sharing the same Network can exchange Raft messages and
+snapshots without opening any network port. The Network instance also allows
+faults such as dropped message batches, delayed deliveries and network
+partitions to be injected.
+*/
+package memtransport
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/lni/goutils/syncutil"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	// TransportName is the name of the in-memory transport module.
+	TransportName = "mem-transport"
+	msgChanLength = 64
+)
+
+var (
+	// ErrClosed indicates that the connection or the transport has been closed.
+	ErrClosed = errors.New("memtransport: closed")
+	// ErrUnreachable indicates that the target is not reachable, either because
+	// it is not listening or because it has been partitioned away.
+	ErrUnreachable = errors.New("memtransport: target unreachable")
+	// ErrAddressInUse indicates that another transport instance is already
+	// listening on the same address.
+	ErrAddressInUse = errors.New("memtransport: address already in use")
+	// ErrChunkRejected indicates that the receiver rejected a snapshot chunk.
+	ErrChunkRejected = errors.New("memtransport: chunk rejected")
+)
+
+// Network is a shared in-process network connecting transport instances by
+// their RaftAddress values. Network implements the config.TransportFactory
+// interface, set it as the NodeHostConfig.Expert.TransportFactory field of all
+// NodeHost instances that are expected to communicate with each other.
+type Network struct {
+	mu        sync.Mutex
+	listeners map[string]*Transport
+	groups    map[string]int
+	rand      *rand.Rand
+	dropRate  float64
+	latency   time.Duration
+}
+
+var _ config.TransportFactory = (*Network)(nil)
+
+// NewNetwork creates a new Network instance.
+func NewNetwork() *Network {
+	return &Network{
+		listeners: make(map[string]*Transport),
+		groups:    make(map[string]int),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Create creates a transport instance attached to the network.
+func (n *Network) Create(nhConfig config.NodeHostConfig,
+	handler raftio.MessageHandler,
+	chunkHandler raftio.ChunkHandler) raftio.ITransport {
+	return &Transport{
+		network:        n,
+		addr:           nhConfig.RaftAddress,
+		requestHandler: handler,
+		chunkHandler:   chunkHandler,
+		stopper:        syncutil.NewStopper(),
+	}
+}
+
+// Validate returns a boolean value indicating whether the specified address is
+// valid. Any non-empty string is accepted as an address on the network.
+func (n *Network) Validate(addr string) bool {
+	return len(addr) > 0
+}
+
+// SetDropRate sets the probability, in the range of [0, 1], of each message
+// batch being silently dropped. Snapshot chunks are never dropped.
+func (n *Network) SetDropRate(rate float64) {
+	if rate < 0 || rate > 1 {
+		panic("invalid drop rate")
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dropRate = rate
+}
+
+// SetLatency sets the extra latency added to the delivery of each message
+// batch.
+func (n *Network) SetLatency(latency time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.latency = latency
+}
+
+// Partition splits the network into the specified groups of addresses.
+// Addresses from different groups can no longer reach each other, addresses
+// not included in any group can still reach all others. Existing connections
+// that cross group boundaries fail on their next send.
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.groups = make(map[string]int)
+	for i, g := range groups {
+		for _, addr := range g {
+			n.groups[addr] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+// NodeHostConfigs returns count NodeHostConfig instances wired over the
+// network. The NodeHostDir of each returned config is a sub-directory of the
+// specified dir, the RaftAddress of the i-th config is Address(i).
+func (n *Network) NodeHostConfigs(count int,
+	dir string, rttMillisecond uint64) []config.NodeHostConfig {
+	result := make([]config.NodeHostConfig, 0, count)
+	for i := 1; i <= count; i++ {
+		nhDir := fmt.Sprintf("%s/nh%d", dir, i)
+		result = append(result, config.NodeHostConfig{
+			NodeHostDir:    nhDir,
+			WALDir:         nhDir,
+			RTTMillisecond: rttMillisecond,
+			RaftAddress:    Address(i),
+			Expert:         config.ExpertConfig{TransportFactory: n},
+		})
+	}
+	return result
+}
+
+// Address returns the RaftAddress used by the i-th NodeHost returned by the
+// NodeHostConfigs method.
+func Address(i int) string {
+	return fmt.Sprintf("memtransport-nh-%d", i)
+}
+
+func (n *Network) listen(addr string, t *Transport) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return ErrAddressInUse
+	}
+	n.listeners[addr] = t
+	return nil
+}
+
+func (n *Network) unlisten(addr string, t *Transport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if v, ok := n.listeners[addr]; ok && v == t {
+		delete(n.listeners, addr)
+	}
+}
+
+func (n *Network) reachable(from string, to string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.groups[from] == 0 ||
+		n.groups[to] == 0 || n.groups[from] == n.groups[to]
+}
+
+func (n *Network) dial(from string, to string) (*Transport, error) {
+	if !n.reachable(from, to) {
+		return nil, ErrUnreachable
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	t, ok := n.listeners[to]
+	if !ok {
+		return nil, ErrUnreachable
+	}
+	return t, nil
+}
+
+func (n *Network) shouldDrop() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.dropRate > 0 && n.rand.Float64() < n.dropRate
+}
+
+func (n *Network) getLatency() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.latency
+}
+
+// Transport is the in-memory transport module.
+type Transport struct {
+	mu struct {
+		sync.Mutex
+		stopped bool
+	}
+	network        *Network
+	requestHandler raftio.MessageHandler
+	chunkHandler   raftio.ChunkHandler
+	stopper        *syncutil.Stopper
+	addr           string
+}
+
+var _ raftio.ITransport = (*Transport)(nil)
+
+// Name returns the name of the transport module.
+func (t *Transport) Name() string {
+	return TransportName
+}
+
+// Start starts the transport module.
+func (t *Transport) Start() error {
+	return t.network.listen(t.addr, t)
+}
+
+// Close closes the transport module.
+func (t *Transport) Close() error {
+	t.network.unlisten(t.addr, t)
+	t.mu.Lock()
+	t.mu.stopped = true
+	t.mu.Unlock()
+	t.stopper.Stop()
+	return nil
+}
+
+// GetConnection returns a connection used for sending message batches to the
+// specified target.
+func (t *Transport) GetConnection(ctx context.Context,
+	target string) (raftio.IConnection, error) {
+	remote, err := t.network.dial(t.addr, target)
+	if err != nil {
+		return nil, err
+	}
+	c := &connection{
+		network: t.network,
+		from:    t.addr,
+		to:      target,
+		ch:      make(chan delivery, msgChanLength),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if !remote.run(func() { remote.serveConn(c) }) {
+		return nil, ErrUnreachable
+	}
+	return c, nil
+}
+
+// GetSnapshotConnection returns a connection used for sending snapshot chunks
+// to the specified target.
+func (t *Transport) GetSnapshotConnection(ctx context.Context,
+	target string) (raftio.ISnapshotConnection, error) {
+	remote, err := t.network.dial(t.addr, target)
+	if err != nil {
+		return nil, err
+	}
+	r, w := io.Pipe()
+	c := &snapshotConnection{
+		network: t.network,
+		from:    t.addr,
+		to:      target,
+		w:       w,
+	}
+	if !remote.run(func() { remote.serveSnapshotConn(r) }) {
+		return nil, ErrUnreachable
+	}
+	return c, nil
+}
+
+func (t *Transport) run(f func()) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.mu.stopped {
+		return false
+	}
+	t.stopper.RunWorker(f)
+	return true
+}
+
+func (t *Transport) serveConn(c *connection) {
+	defer close(c.done)
+	for {
+		select {
+		case <-t.stopper.ShouldStop():
+			return
+		case <-c.closed:
+			// deliver whatever has already been sent before the close
+			for {
+				select {
+				case d := <-c.ch:
+					if !t.deliver(d) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case d := <-c.ch:
+			if !t.deliver(d) {
+				return
+			}
+		}
+	}
+}
+
+func (t *Transport) deliver(d delivery) bool {
+	if wait := time.Until(d.deliverAt); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-t.stopper.ShouldStop():
+			timer.Stop()
+			return false
+		}
+	}
+	batch := pb.MessageBatch{}
+	if err := batch.Unmarshal(d.data); err != nil {
+		panic(err)
+	}
+	t.requestHandler(batch)
+	return true
+}
+
+func (t *Transport) serveSnapshotConn(r *io.PipeReader) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-t.stopper.ShouldStop():
+			_ = r.CloseWithError(ErrClosed)
+		case <-done:
+		}
+	}()
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint64(header))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return
+		}
+		chunk := pb.Chunk{}
+		if err := chunk.Unmarshal(data); err != nil {
+			panic(err)
+		}
+		if !t.chunkHandler(chunk) {
+			_ = r.CloseWithError(ErrChunkRejected)
+			return
+		}
+	}
+}
+
+type delivery struct {
+	deliverAt time.Time
+	data      []byte
+}
+
+type connection struct {
+	network *Network
+	ch      chan delivery
+	closed  chan struct{}
+	done    chan struct{}
+	from    string
+	to      string
+	once    sync.Once
+}
+
+var _ raftio.IConnection = (*connection)(nil)
+
+// Close closes the connection.
+func (c *connection) Close() {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+}
+
+// SendMessageBatch sends the message batch to the target.
+func (c *connection) SendMessageBatch(batch pb.MessageBatch) error {
+	if !c.network.reachable(c.from, c.to) {
+		return ErrUnreachable
+	}
+	if c.network.shouldDrop() {
+		return nil
+	}
+	d := delivery{
+		deliverAt: time.Now().Add(c.network.getLatency()),
+		data:      pb.MustMarshal(&batch),
+	}
+	select {
+	case <-c.closed:
+		return ErrClosed
+	case <-c.done:
+		return ErrClosed
+	case c.ch <- d:
+	}
+	return nil
+}
+
+type snapshotConnection struct {
+	network *Network
+	w       *io.PipeWriter
+	from    string
+	to      string
+}
+
+var _ raftio.ISnapshotConnection = (*snapshotConnection)(nil)
+
+// Close closes the snapshot connection.
+func (c *snapshotConnection) Close() {
+	_ = c.w.Close()
+}
+
+// SendChunk sends the snapshot chunk to the target.
+func (c *snapshotConnection) SendChunk(chunk pb.Chunk) error {
+	if !c.network.reachable(c.from, c.to) {
+		return ErrUnreachable
+	}
+	data := pb.MustMarshal(&chunk)
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint64(header, uint64(len(data)))
+	if _, err := c.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memtransport
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+type testReceiver struct {
+	mu      sync.Mutex
+	batches []pb.MessageBatch
+	chunks  []pb.Chunk
+	reject  bool
+}
+
+func (r *testReceiver) handleBatch(b pb.MessageBatch) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, b)
+}
+
+func (r *testReceiver) handleChunk(c pb.Chunk) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reject {
+		return false
+	}
+	r.chunks = append(r.chunks, c)
+	return true
+}
+
+func (r *testReceiver) batchCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.batches)
+}
+
+func (r *testReceiver) chunkCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.chunks)
+}
+
+func newTestTransport(t *testing.T, n *Network,
+	addr string) (raftio.ITransport, *testReceiver) {
+	r := &testReceiver{}
+	tr := n.Create(config.NodeHostConfig{RaftAddress: addr},
+		r.handleBatch, r.handleChunk)
+	require.NoError(t, tr.Start())
+	return tr, r
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	for i := 0; i < 200; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("condition not met")
+}
+
+func testBatch() pb.MessageBatch {
+	return pb.MessageBatch{
+		Requests: []pb.Message{{Type: pb.Heartbeat, ShardID: 1, From: 1, To: 2}},
+	}
+}
+
+func TestMessageBatchCanBeDelivered(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	n := NewNetwork()
+	t1, _ := newTestTransport(t, n, "a1")
+	defer t1.Close()
+	t2, r2 := newTestTransport(t, n, "a2")
+	defer t2.Close()
+	conn, err := t1.GetConnection(context.Background(), "a2")
+	require.NoError(t, err)
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, conn.SendMessageBatch(testBatch()))
+	}
+	waitFor(t, func() bool { return r2.batchCount() == 10 })
+}
+
+func TestAddressCanOnlyBeUsedOnce(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	n := NewNetwork()
+	t1, _ := newTestTransport(t, n, "a1")
+	defer t1.Close()
+	t2 := n.Create(config.NodeHostConfig{RaftAddress: "a1"}, nil, nil)
+	assert.Equal(t, ErrAddressInUse, t2.Start())
+}
+
+func TestUnknownTargetIsUnreachable(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	n := NewNetwork()
+	t1, _ := newTestTransport(t, n, "a1")
+	defer t1.Close()
+	_, err := t1.GetConnection(context.Background(), "a2")
+	assert.Equal(t, ErrUnreachable, err)
+	_, err = t1.GetSnapshotConnection(context.Background(), "a2")
+	assert.Equal(t, ErrUnreachable, err)
+}
+
+func TestPartitionCanBeSetAndHealed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	n := NewNetwork()
+	t1, _ := newTestTransport(t, n, "a1")
+	defer t1.Close()
+	t2, r2 := newTestTransport(t, n, "a2")
+	defer t2.Close()
+	t3, r3 := newTestTransport(t, n, "a3")
+	defer t3.Close()
+	conn, err := t1.GetConnection(context.Background(), "a2")
+	require.NoError(t, err)
+	defer conn.Close()
+	n.Partition([]string{"a1"}, []string{"a2"})
+	assert.Equal(t, ErrUnreachable, conn.SendMessageBatch(testBatch()))
+	_, err = t1.GetConnection(context.Background(), "a2")
+	assert.Equal(t, ErrUnreachable, err)
+	// a3 is not in any group
+	conn3, err := t1.GetConnection(context.Background(), "a3")
+	require.NoError(t, err)
+	defer conn3.Close()
+	require.NoError(t, conn3.SendMessageBatch(testBatch()))
+	waitFor(t, func() bool { return r3.batchCount() == 1 })
+	n.Heal()
+	require.NoError(t, conn.SendMessageBatch(testBatch()))
+	waitFor(t, func() bool { return r2.batchCount() == 1 })
+}
+
+func TestMessageBatchCanBeDropped(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	n := NewNetwork()
+	t1, _ := newTestTransport(t, n, "a1")
+	defer t1.Close()
+	t2, r2 := newTestTransport(t, n, "a2")
+	defer t2.Close()
+	conn, err := t1.GetConnection(context.Background(), "a2")
+	require.NoError(t, err)
+	defer conn.Close()
+	n.SetDropRate(1.0)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, conn.SendMessageBatch(testBatch()))
+	}
+	n.SetDropRate(0)
+	require.NoError(t, conn.SendMessageBatch(testBatch()))
+	waitFor(t, func() bool { return r2.batchCount() == 1 })
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, r2.batchCount())
+}
+
+func TestLatencyCanBeAdded(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	n := NewNetwork()
+	t1, _ := newTestTransport(t, n, "a1")
+	defer t1.Close()
+	t2, r2 := newTestTransport(t, n, "a2")
+	defer t2.Close()
+	conn, err := t1.GetConnection(context.Background(), "a2")
+	require.NoError(t, err)
+	defer conn.Close()
+	n.SetLatency(200 * time.Millisecond)
+	start := time.Now()
+	require.NoError(t, conn.SendMessageBatch(testBatch()))
+	waitFor(t, func() bool { return r2.batchCount() == 1 })
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+}
+
+func TestSnapshotChunksCanBeDelivered(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	n := NewNetwork()
+	t1, _ := newTestTransport(t, n, "a1")
+	defer t1.Close()
+	t2, r2 := newTestTransport(t, n, "a2")
+	defer t2.Close()
+	conn, err := t1.GetSnapshotConnection(context.Background(), "a2")
+	require.NoError(t, err)
+	for i := uint64(0); i < 4; i++ {
+		chunk := pb.Chunk{ShardID: 1, ChunkId: i, ChunkCount: 4,
+			Data: make([]byte, 1024)}
+		require.NoError(t, conn.SendChunk(chunk))
+	}
+	conn.Close()
+	waitFor(t, func() bool { return r2.chunkCount() == 4 })
+}
+
+func TestRejectedChunkFailsTheSender(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	n := NewNetwork()
+	t1, _ := newTestTransport(t, n, "a1")
+	defer t1.Close()
+	t2, r2 := newTestTransport(t, n, "a2")
+	defer t2.Close()
+	r2.reject = true
+	conn, err := t1.GetSnapshotConnection(context.Background(), "a2")
+	require.NoError(t, err)
+	defer conn.Close()
+	chunk := pb.Chunk{ShardID: 1, ChunkCount: 2, Data: make([]byte, 16)}
+	require.NoError(t, conn.SendChunk(chunk))
+	failed := false
+	for i := 0; i < 10; i++ {
+		if err := conn.SendChunk(chunk); err != nil {
+			failed = true
+			break
+		}
+	}
+	assert.True(t, failed)
+}
+
+func TestClosedTransportFailsPendingSnapshotConnection(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	n := NewNetwork()
+	t1, _ := newTestTransport(t, n, "a1")
+	defer t1.Close()
+	t2, _ := newTestTransport(t, n, "a2")
+	conn, err := t1.GetSnapshotConnection(context.Background(), "a2")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, t2.Close())
+	chunk := pb.Chunk{ShardID: 1, ChunkCount: 2, Data: make([]byte, 16)}
+	assert.Error(t, conn.SendChunk(chunk))
+}
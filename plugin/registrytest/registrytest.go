@@ -0,0 +1,344 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package registrytest contains conformance tests for raftio.IRegistry
+implementations. Custom registries, e.g. those backed by etcd or consul, can
+run the same set of tests by calling the Run function from their own tests.
+*/
+package registrytest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/raftio"
+)
+
+// Harness is used by conformance tests to create and control registries.
+type Harness struct {
+	// Create creates a registry for the NodeHost with the specified NodeHostID
+	// and RaftAddress, meta is the metadata to be published by the registry.
+	// All registries created by the same Harness instance must share the same
+	// backing service.
+	Create func(nhid string,
+		raftAddress string, meta []byte) (raftio.IRegistry, error)
+	// Expire makes records published so far stale, e.g. by advancing the
+	// clock used by all registries beyond their TTL. Tests on stale record
+	// expiry are skipped when Expire is nil.
+	Expire func()
+	// Timeout is the amount of time to wait for updates to become visible to
+	// other registries, 10 seconds is used when it is 0.
+	Timeout time.Duration
+}
+
+// Run runs all conformance tests. The specified function is invoked to get a
+// Harness instance with a clean backing service for each test.
+func Run(t *testing.T, newHarness func(t *testing.T) Harness) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, h Harness)
+	}{
+		{"LocalNodeHostIsKnown", testLocalNodeHostIsKnown},
+		{"NodeHostsCanDiscoverEachOther", testNodeHostsCanDiscoverEachOther},
+		{"ShardViewsAreMerged", testShardViewsAreMerged},
+		{"AddressChangeIsVisible", testAddressChangeIsVisible},
+		{"ClosedNodeHostIsRemoved", testClosedNodeHostIsRemoved},
+		{"StaleRecordsExpire", testStaleRecordsExpire},
+		{"ConcurrentUpdates", testConcurrentUpdates},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f(t, newHarness(t))
+		})
+	}
+}
+
+// nodeHost is a registry with the shard views it publishes.
+type nodeHost struct {
+	nhid   string
+	r      raftio.IRegistry
+	mu     sync.Mutex
+	shards []raftio.ShardView
+	closed bool
+}
+
+func create(t *testing.T, h Harness,
+	nhid string, raftAddress string, meta []byte) *nodeHost {
+	t.Helper()
+	r, err := h.Create(nhid, raftAddress, meta)
+	if err != nil {
+		t.Fatalf("failed to create registry for %s, %v", nhid, err)
+	}
+	nh := &nodeHost{nhid: nhid, r: r}
+	t.Cleanup(func() { nh.close(t) })
+	return nh
+}
+
+func (nh *nodeHost) publish(t *testing.T, shards ...raftio.ShardView) {
+	t.Helper()
+	nh.mu.Lock()
+	nh.shards = shards
+	nh.mu.Unlock()
+	nh.refresh(t)
+}
+
+func (nh *nodeHost) refresh(t *testing.T) {
+	t.Helper()
+	nh.mu.Lock()
+	shards := nh.shards
+	nh.mu.Unlock()
+	if err := nh.r.Publish(shards); err != nil {
+		t.Errorf("%s failed to publish, %v", nh.nhid, err)
+	}
+}
+
+func (nh *nodeHost) close(t *testing.T) {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	if nh.closed {
+		return
+	}
+	nh.closed = true
+	if err := nh.r.Close(); err != nil {
+		t.Errorf("%s failed to close, %v", nh.nhid, err)
+	}
+}
+
+// waitFor waits for the condition to become true, all specified NodeHosts
+// keep publishing their shard views while waiting.
+func waitFor(t *testing.T, h Harness,
+	desc string, cond func() bool, nhs ...*nodeHost) {
+	t.Helper()
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, nh := range nhs {
+			nh.refresh(t)
+		}
+		if cond() {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", desc)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func hasNodeHost(r raftio.IRegistry, nhid string, addr string) bool {
+	nh, ok := r.GetNodeHost(nhid)
+	return ok && nh.NodeHostID == nhid && nh.RaftAddress == addr
+}
+
+func testLocalNodeHostIsKnown(t *testing.T, h Harness) {
+	nh := create(t, h, "nh1", "localhost:9001", []byte("meta1"))
+	info, ok := nh.r.GetNodeHost("nh1")
+	if !ok {
+		t.Fatalf("local NodeHost not found")
+	}
+	if info.RaftAddress != "localhost:9001" || string(info.Meta) != "meta1" {
+		t.Errorf("unexpected NodeHostInfo %+v", info)
+	}
+	if _, ok := nh.r.GetNodeHost("nh2"); ok {
+		t.Errorf("unknown NodeHost found")
+	}
+	if _, ok := nh.r.GetShardView(1); ok {
+		t.Errorf("unknown shard found")
+	}
+	if n := nh.r.NumOfShards(); n != 0 {
+		t.Errorf("unexpected shard count %d", n)
+	}
+}
+
+func testNodeHostsCanDiscoverEachOther(t *testing.T, h Harness) {
+	nh1 := create(t, h, "nh1", "localhost:9001", []byte("meta1"))
+	nh2 := create(t, h, "nh2", "localhost:9002", nil)
+	waitFor(t, h, "NodeHosts to discover each other", func() bool {
+		return hasNodeHost(nh1.r, "nh2", "localhost:9002") &&
+			hasNodeHost(nh2.r, "nh1", "localhost:9001")
+	}, nh1, nh2)
+	if info, _ := nh2.r.GetNodeHost("nh1"); string(info.Meta) != "meta1" {
+		t.Errorf("unexpected meta %s", info.Meta)
+	}
+	for _, nh := range []*nodeHost{nh1, nh2} {
+		all := nh.r.NodeHosts()
+		found := make(map[string]bool)
+		for _, info := range all {
+			found[info.NodeHostID] = true
+		}
+		if len(all) != 2 || !found["nh1"] || !found["nh2"] {
+			t.Errorf("%s, unexpected NodeHosts %+v", nh.nhid, all)
+		}
+	}
+}
+
+func testShardViewsAreMerged(t *testing.T, h Harness) {
+	nh1 := create(t, h, "nh1", "localhost:9001", nil)
+	nh2 := create(t, h, "nh2", "localhost:9002", nil)
+	nh1.publish(t, raftio.ShardView{
+		ShardID:           1,
+		Replicas:          map[uint64]string{1: "nh1"},
+		ConfigChangeIndex: 1,
+	})
+	nh2.publish(t, raftio.ShardView{
+		ShardID:           1,
+		Replicas:          map[uint64]string{1: "nh1", 2: "nh2"},
+		ConfigChangeIndex: 2,
+		LeaderID:          2,
+		Term:              3,
+	}, raftio.ShardView{
+		ShardID:           2,
+		Replicas:          map[uint64]string{1: "nh2"},
+		ConfigChangeIndex: 1,
+		LeaderID:          1,
+		Term:              1,
+	})
+	merged := func(r raftio.IRegistry) bool {
+		sv, ok := r.GetShardView(1)
+		return ok && r.NumOfShards() == 2 &&
+			sv.ConfigChangeIndex == 2 && len(sv.Replicas) == 2 &&
+			sv.LeaderID == 2 && sv.Term == 3
+	}
+	waitFor(t, h, "shard views to be merged", func() bool {
+		return merged(nh1.r) && merged(nh2.r)
+	}, nh1, nh2)
+	sv, _ := nh1.r.GetShardView(2)
+	if sv.ShardID != 2 || sv.Replicas[1] != "nh2" || sv.LeaderID != 1 {
+		t.Errorf("unexpected shard view %+v", sv)
+	}
+	// a leader with higher term replaces the known leader
+	nh1.publish(t, raftio.ShardView{
+		ShardID:           1,
+		Replicas:          map[uint64]string{1: "nh1", 2: "nh2"},
+		ConfigChangeIndex: 2,
+		LeaderID:          1,
+		Term:              4,
+	})
+	waitFor(t, h, "leader to be updated", func() bool {
+		sv, ok := nh2.r.GetShardView(1)
+		return ok && sv.LeaderID == 1 && sv.Term == 4
+	}, nh1, nh2)
+}
+
+func testAddressChangeIsVisible(t *testing.T, h Harness) {
+	nh1 := create(t, h, "nh1", "localhost:9001", nil)
+	nh2 := create(t, h, "nh2", "localhost:9002", nil)
+	waitFor(t, h, "nh2 to be discovered", func() bool {
+		return hasNodeHost(nh1.r, "nh2", "localhost:9002")
+	}, nh1, nh2)
+	nh2.close(t)
+	nh2 = create(t, h, "nh2", "localhost:9012", nil)
+	waitFor(t, h, "address change to be visible", func() bool {
+		return hasNodeHost(nh1.r, "nh2", "localhost:9012")
+	}, nh1, nh2)
+}
+
+func testClosedNodeHostIsRemoved(t *testing.T, h Harness) {
+	nh1 := create(t, h, "nh1", "localhost:9001", nil)
+	nh2 := create(t, h, "nh2", "localhost:9002", nil)
+	nh2.publish(t, raftio.ShardView{ShardID: 2, ConfigChangeIndex: 1})
+	waitFor(t, h, "nh2 to be discovered", func() bool {
+		return hasNodeHost(nh1.r, "nh2", "localhost:9002")
+	}, nh1, nh2)
+	nh2.close(t)
+	waitFor(t, h, "closed NodeHost to be removed", func() bool {
+		_, ok := nh1.r.GetNodeHost("nh2")
+		return !ok && len(nh1.r.NodeHosts()) == 1
+	}, nh1)
+}
+
+func testStaleRecordsExpire(t *testing.T, h Harness) {
+	if h.Expire == nil {
+		t.Skip("Expire not provided")
+	}
+	nh1 := create(t, h, "nh1", "localhost:9001", nil)
+	nh2 := create(t, h, "nh2", "localhost:9002", nil)
+	nh2.publish(t, raftio.ShardView{ShardID: 2, ConfigChangeIndex: 1})
+	waitFor(t, h, "nh2 to be discovered", func() bool {
+		_, ok := nh1.r.GetShardView(2)
+		return ok && hasNodeHost(nh1.r, "nh2", "localhost:9002")
+	}, nh1, nh2)
+	// nh2 stops publishing without closing its registry, e.g. it crashed
+	h.Expire()
+	waitFor(t, h, "stale record to expire", func() bool {
+		_, ok := nh1.r.GetNodeHost("nh2")
+		_, shard := nh1.r.GetShardView(2)
+		return !ok && !shard
+	}, nh1)
+	if !hasNodeHost(nh1.r, "nh1", "localhost:9001") {
+		t.Errorf("local NodeHost expired")
+	}
+	// nh2 is back
+	nh2.refresh(t)
+	waitFor(t, h, "nh2 to be rediscovered", func() bool {
+		return hasNodeHost(nh1.r, "nh2", "localhost:9002")
+	}, nh1, nh2)
+}
+
+func testConcurrentUpdates(t *testing.T, h Harness) {
+	const count = 8
+	const rounds = 20
+	nhs := make([]*nodeHost, 0, count)
+	for i := 0; i < count; i++ {
+		nhid := fmt.Sprintf("nh%d", i+1)
+		nhs = append(nhs, create(t, h, nhid, fmt.Sprintf("localhost:%d", 9001+i), nil))
+	}
+	var wg sync.WaitGroup
+	for i, nh := range nhs {
+		wg.Add(1)
+		go func(shardID uint64, nh *nodeHost) {
+			defer wg.Done()
+			for j := uint64(1); j <= rounds; j++ {
+				nh.publish(t, raftio.ShardView{
+					ShardID:           shardID,
+					Replicas:          map[uint64]string{1: nh.nhid},
+					ConfigChangeIndex: j,
+					LeaderID:          1,
+					Term:              j,
+				})
+				for _, other := range nhs {
+					nh.r.GetNodeHost(other.nhid)
+				}
+				nh.r.NodeHosts()
+				nh.r.GetShardView(shardID)
+			}
+		}(uint64(i+1), nh)
+	}
+	wg.Wait()
+	waitFor(t, h, "all updates to be visible", func() bool {
+		for _, nh := range nhs {
+			if len(nh.r.NodeHosts()) != count || nh.r.NumOfShards() != count {
+				return false
+			}
+			for i, other := range nhs {
+				addr := fmt.Sprintf("localhost:%d", 9001+i)
+				if !hasNodeHost(nh.r, other.nhid, addr) {
+					return false
+				}
+				sv, ok := nh.r.GetShardView(uint64(i + 1))
+				if !ok || sv.ConfigChangeIndex != rounds || sv.Term != rounds {
+					return false
+				}
+			}
+		}
+		return true
+	}, nhs...)
+}
@@ -0,0 +1,260 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package soaktest
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+)
+
+// Envelope contains the limits of monitored values, a run fails as soon as
+// any sampled value exceeds its limit. Limits of per NodeHost values apply to
+// each NodeHost. A zero limit means the value is not checked.
+type Envelope struct {
+	// MaxGoroutineGrowth is the maximum increase of the goroutine count over
+	// its baseline sampled once the warm up completes. It is also checked once
+	// all NodeHosts are closed, against the count before the run.
+	MaxGoroutineGrowth uint64
+	// MaxHeapBytes is the maximum number of allocated heap bytes.
+	MaxHeapBytes uint64
+	// MaxInMemLogBytes is the maximum of MemoryStats.InMemLog.
+	MaxInMemLogBytes uint64
+	// MaxPendingProposalBytes is the maximum of MemoryStats.PendingProposals.
+	MaxPendingProposalBytes uint64
+	// MaxInboundMessageBytes is the maximum of MemoryStats.InboundMessages.
+	MaxInboundMessageBytes uint64
+	// MaxSnapshotChunkBytes is the maximum of MemoryStats.SnapshotStaging.
+	MaxSnapshotChunkBytes uint64
+	// MaxStagingBytes is the maximum of SnapshotStagingInfo.Bytes.
+	MaxStagingBytes uint64
+	// MaxPendingProposals is the maximum of PendingRequestStats.Proposals.
+	MaxPendingProposals uint64
+	// MaxPendingReads is the maximum of PendingRequestStats.Reads.
+	MaxPendingReads uint64
+	// MaxApplyLag is the maximum number of committed entries not yet applied
+	// by any replica.
+	MaxApplyLag uint64
+}
+
+// Sample is a sample of the monitored values.
+type Sample struct {
+	// Elapsed is the time since the start of the run.
+	Elapsed time.Duration
+	// Goroutines is the goroutine count.
+	Goroutines int
+	// GoroutineGrowth is the increase of the goroutine count over its baseline,
+	// it is 0 until the warm up completes.
+	GoroutineGrowth uint64
+	// HeapBytes is the number of allocated heap bytes.
+	HeapBytes uint64
+	// NodeHosts are samples of the running NodeHosts.
+	NodeHosts []NodeHostSample
+}
+
+// NodeHostSample is a sample of the values monitored on a NodeHost.
+type NodeHostSample struct {
+	// NodeHost is the 1-based index of the NodeHost.
+	NodeHost int
+	// Memory is the memory accounted by the NodeHost.
+	Memory dragonboat.MemoryStats
+	// StagingBytes is the number of bytes in snapshot staging directories.
+	StagingBytes uint64
+	// Pending is the numbers of pending requests.
+	Pending dragonboat.PendingRequestStats
+	// MaxApplyLag is the maximum apply lag of all replicas on the NodeHost.
+	MaxApplyLag uint64
+}
+
+// Violation describes a monitored value exceeding its limit.
+type Violation struct {
+	Monitor string
+	// NodeHost is the 1-based index of the NodeHost on which the value was
+	// sampled, it is 0 for process wide values.
+	NodeHost int    `json:",omitempty"`
+	Value    uint64 `json:",omitempty"`
+	Limit    uint64 `json:",omitempty"`
+	Elapsed  time.Duration
+	Detail   string `json:",omitempty"`
+}
+
+func (v Violation) String() string {
+	if len(v.Detail) > 0 {
+		return fmt.Sprintf("%s: %s", v.Monitor, v.Detail)
+	}
+	if v.NodeHost > 0 {
+		return fmt.Sprintf("%s on NodeHost %d: %d > %d at %s",
+			v.Monitor, v.NodeHost, v.Value, v.Limit, v.Elapsed)
+	}
+	return fmt.Sprintf("%s: %d > %d at %s",
+		v.Monitor, v.Value, v.Limit, v.Elapsed)
+}
+
+// monitor checks a process wide value when nodeHost is nil, or a value of
+// each NodeHost otherwise.
+type monitor struct {
+	name     string
+	limit    func(e Envelope) uint64
+	process  func(s Sample) uint64
+	nodeHost func(s NodeHostSample) uint64
+}
+
+var monitors = []monitor{
+	{
+		name:    "goroutine-growth",
+		limit:   func(e Envelope) uint64 { return e.MaxGoroutineGrowth },
+		process: func(s Sample) uint64 { return s.GoroutineGrowth },
+	},
+	{
+		name:    "heap-bytes",
+		limit:   func(e Envelope) uint64 { return e.MaxHeapBytes },
+		process: func(s Sample) uint64 { return s.HeapBytes },
+	},
+	{
+		name:     "in-mem-log-bytes",
+		limit:    func(e Envelope) uint64 { return e.MaxInMemLogBytes },
+		nodeHost: func(s NodeHostSample) uint64 { return s.Memory.InMemLog },
+	},
+	{
+		name:     "pending-proposal-bytes",
+		limit:    func(e Envelope) uint64 { return e.MaxPendingProposalBytes },
+		nodeHost: func(s NodeHostSample) uint64 { return s.Memory.PendingProposals },
+	},
+	{
+		name:     "inbound-message-bytes",
+		limit:    func(e Envelope) uint64 { return e.MaxInboundMessageBytes },
+		nodeHost: func(s NodeHostSample) uint64 { return s.Memory.InboundMessages },
+	},
+	{
+		name:     "snapshot-chunk-bytes",
+		limit:    func(e Envelope) uint64 { return e.MaxSnapshotChunkBytes },
+		nodeHost: func(s NodeHostSample) uint64 { return s.Memory.SnapshotStaging },
+	},
+	{
+		name:     "staging-bytes",
+		limit:    func(e Envelope) uint64 { return e.MaxStagingBytes },
+		nodeHost: func(s NodeHostSample) uint64 { return s.StagingBytes },
+	},
+	{
+		name:     "pending-proposals",
+		limit:    func(e Envelope) uint64 { return e.MaxPendingProposals },
+		nodeHost: func(s NodeHostSample) uint64 { return s.Pending.Proposals },
+	},
+	{
+		name:     "pending-reads",
+		limit:    func(e Envelope) uint64 { return e.MaxPendingReads },
+		nodeHost: func(s NodeHostSample) uint64 { return s.Pending.Reads },
+	},
+	{
+		name:     "apply-lag",
+		limit:    func(e Envelope) uint64 { return e.MaxApplyLag },
+		nodeHost: func(s NodeHostSample) uint64 { return s.MaxApplyLag },
+	},
+}
+
+// check updates peaks with values in the sample and returns violations of
+// limits in the envelope.
+func check(e Envelope, s Sample, peaks map[string]uint64) []Violation {
+	var violations []Violation
+	observe := func(m monitor, nodeHost int, v uint64) {
+		if v > peaks[m.name] {
+			peaks[m.name] = v
+		}
+		if limit := m.limit(e); limit > 0 && v > limit {
+			violations = append(violations, Violation{
+				Monitor:  m.name,
+				NodeHost: nodeHost,
+				Value:    v,
+				Limit:    limit,
+				Elapsed:  s.Elapsed,
+			})
+		}
+	}
+	for _, m := range monitors {
+		if m.nodeHost == nil {
+			observe(m, 0, m.process(s))
+			continue
+		}
+		for _, nhs := range s.NodeHosts {
+			observe(m, nhs.NodeHost, m.nodeHost(nhs))
+		}
+	}
+	return violations
+}
+
+// sampler periodically samples monitored values and checks them against the
+// configured envelope.
+type sampler struct {
+	c        *cluster
+	start    time.Time
+	baseline int
+}
+
+func newSampler(c *cluster) *sampler {
+	return &sampler{c: c, start: time.Now()}
+}
+
+// run samples monitored values until ctx is done or any value exceeds its
+// limit.
+func (s *sampler) run(ctx context.Context, report *Report) error {
+	ticker := time.NewTicker(s.c.cfg.SampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		sample := s.sample()
+		report.Samples++
+		report.Last = sample
+		violations := check(s.c.cfg.Envelope, sample, report.Peaks)
+		if len(violations) > 0 {
+			report.Violations = append(report.Violations, violations...)
+			return errors.Wrapf(ErrEnvelopeExceeded, "%s", violations[0])
+		}
+		s.c.cfg.Logf("%s: %d goroutines, %d heap bytes",
+			sample.Elapsed, sample.Goroutines, sample.HeapBytes)
+	}
+}
+
+func (s *sampler) sample() Sample {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	sample := Sample{
+		Elapsed:    time.Since(s.start),
+		Goroutines: runtime.NumGoroutine(),
+		HeapBytes:  ms.HeapAlloc,
+	}
+	if sample.Elapsed >= s.c.cfg.WarmUp {
+		if s.baseline == 0 {
+			s.baseline = sample.Goroutines
+		}
+		if sample.Goroutines > s.baseline {
+			sample.GoroutineGrowth = uint64(sample.Goroutines - s.baseline)
+		}
+	}
+	for i := 1; i <= len(s.c.nodeHosts); i++ {
+		if nh := s.c.nodeHost(i); nh != nil {
+			sample.NodeHosts = append(sample.NodeHosts, s.c.sampleNodeHost(i, nh))
+		}
+	}
+	return sample
+}
@@ -0,0 +1,493 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package soaktest runs long lived mixed workloads against a number of
+in-process NodeHost instances while monitoring their resource usage.
+
+Run starts NodeHosts connected by the memtransport, each running a replica of
+every shard. Clients make proposals with and without client sessions and
+linearizable reads, while membership changes, snapshot requests and NodeHost
+restarts are periodically made. Monitors sample the goroutine count, the heap
+size, the memory accounted by each NodeHost grouped by category, the snapshot
+staging bytes, the pending request counts and the apply lag of all replicas.
+The run fails as soon as any sampled value exceeds its limit in the
+configured Envelope. Once the workload stops, all replicas are expected to
+converge to the same applied index, with no pending requests and no snapshot
+staging bytes left behind.
+
+A Report describing the run is returned and optionally written as JSON, it is
+returned along with the error when the run fails.
+*/
+package soaktest
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/tests"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+)
+
+var (
+	// ErrEnvelopeExceeded indicates that a monitored value exceeded its limit
+	// specified in the Envelope.
+	ErrEnvelopeExceeded = errors.New("soak test envelope exceeded")
+	// ErrNotConverged indicates that replicas failed to converge after the
+	// workload stopped.
+	ErrNotConverged = errors.New("replicas not converged")
+)
+
+// Config is the configuration of a soak test run.
+type Config struct {
+	// Dir is the directory in which NodeHost directories are created.
+	Dir string
+	// Duration is how long the workload is run.
+	Duration time.Duration
+	// NodeHosts is the number of NodeHosts, it must be at least 3 so replicas
+	// can be replaced. It defaults to 3.
+	NodeHosts int
+	// Shards is the number of shards, each NodeHost runs a replica of every
+	// shard. It defaults to 24.
+	Shards int
+	// Clients is the number of concurrent clients. It defaults to 8.
+	Clients int
+	// RTTMillisecond is the RTTMillisecond of all NodeHosts. It defaults to 5.
+	RTTMillisecond uint64
+	// SampleInterval is the interval between samples. It defaults to 1 second.
+	SampleInterval time.Duration
+	// WarmUp is the time after which the baseline goroutine count is sampled.
+	// It defaults to 5 SampleIntervals.
+	WarmUp time.Duration
+	// MembershipChangeInterval is the interval between replacing a randomly
+	// selected replica with a new one. It defaults to 10 seconds, membership
+	// changes are disabled when it is negative.
+	MembershipChangeInterval time.Duration
+	// SnapshotInterval is the interval between snapshot requests made to
+	// randomly selected replicas. It defaults to 5 seconds, snapshot requests
+	// are disabled when it is negative.
+	SnapshotInterval time.Duration
+	// RestartInterval is the interval between restarting randomly selected
+	// NodeHosts. It defaults to 30 seconds, restarts are disabled when it is
+	// negative.
+	RestartInterval time.Duration
+	// ConvergenceTimeout is how long replicas are waited for to converge once
+	// the workload stops. It defaults to 30 seconds.
+	ConvergenceTimeout time.Duration
+	// Envelope is the limits of monitored values.
+	Envelope Envelope
+	// ReportPath is the path of the JSON report written at the end of the run,
+	// no report is written when it is empty.
+	ReportPath string
+	// Logf is used for logging the progress of the run when set.
+	Logf func(format string, args ...interface{})
+	// Seed is the seed of the random source used for selecting shards,
+	// NodeHosts and operations.
+	Seed int64
+}
+
+func (c *Config) prepare() error {
+	if len(c.Dir) == 0 {
+		return errors.New("Dir not set")
+	}
+	if c.Duration <= 0 {
+		return errors.New("Duration not set")
+	}
+	if c.NodeHosts == 0 {
+		c.NodeHosts = 3
+	}
+	if c.NodeHosts < 3 {
+		return errors.New("less than 3 NodeHosts")
+	}
+	if c.Shards == 0 {
+		c.Shards = 24
+	}
+	if c.Clients == 0 {
+		c.Clients = 8
+	}
+	if c.RTTMillisecond == 0 {
+		c.RTTMillisecond = 5
+	}
+	if c.SampleInterval == 0 {
+		c.SampleInterval = time.Second
+	}
+	if c.WarmUp == 0 {
+		c.WarmUp = 5 * c.SampleInterval
+	}
+	if c.MembershipChangeInterval == 0 {
+		c.MembershipChangeInterval = 10 * time.Second
+	}
+	if c.SnapshotInterval == 0 {
+		c.SnapshotInterval = 5 * time.Second
+	}
+	if c.RestartInterval == 0 {
+		c.RestartInterval = 30 * time.Second
+	}
+	if c.ConvergenceTimeout == 0 {
+		c.ConvergenceTimeout = 30 * time.Second
+	}
+	if c.Logf == nil {
+		c.Logf = func(string, ...interface{}) {}
+	}
+	return nil
+}
+
+// Run runs the soak test described by cfg until cfg.Duration has passed, ctx
+// is cancelled or any monitored value exceeds its limit. The returned error
+// wraps ErrEnvelopeExceeded or ErrNotConverged when the run fails because of
+// its monitors, the report is returned in such cases as well.
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if err := cfg.prepare(); err != nil {
+		return nil, err
+	}
+	initial := runtime.NumGoroutine()
+	c, err := newCluster(cfg)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{
+		Started:   time.Now(),
+		NodeHosts: cfg.NodeHosts,
+		Shards:    cfg.Shards,
+		Peaks:     make(map[string]uint64),
+	}
+	runErr := c.run(ctx, report)
+	if runErr == nil {
+		runErr = c.converge(report)
+	}
+	c.close()
+	if runErr == nil {
+		runErr = checkGoroutinesAfterClose(cfg, initial, report)
+	}
+	report.Elapsed = time.Since(report.Started)
+	report.Passed = runErr == nil
+	if runErr != nil {
+		report.Error = runErr.Error()
+	}
+	if len(cfg.ReportPath) > 0 {
+		if err := report.write(cfg.ReportPath); err != nil {
+			return report, errors.CombineErrors(runErr, err)
+		}
+	}
+	return report, runErr
+}
+
+// checkGoroutinesAfterClose checks that goroutines started by NodeHosts have
+// returned once all NodeHosts are closed.
+func checkGoroutinesAfterClose(cfg Config, initial int, report *Report) error {
+	limit := cfg.Envelope.MaxGoroutineGrowth
+	if limit == 0 {
+		return nil
+	}
+	var growth uint64
+	for i := 0; i < 50; i++ {
+		growth = 0
+		if n := runtime.NumGoroutine(); n > initial {
+			growth = uint64(n - initial)
+		}
+		if growth <= limit {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	v := Violation{Monitor: "goroutines-after-close", Value: growth, Limit: limit}
+	report.Violations = append(report.Violations, v)
+	return errors.Wrapf(ErrEnvelopeExceeded, "%s", v)
+}
+
+// cluster owns the NodeHosts of a run. NodeHosts are identified by their
+// 1-based index, the i-th NodeHost uses memtransport.Address(i) as its
+// RaftAddress.
+type cluster struct {
+	cfg       Config
+	network   *memtransport.Network
+	nhConfigs []config.NodeHostConfig
+	members   map[uint64]dragonboat.Target
+	mu        sync.Mutex
+	nodeHosts []*dragonboat.NodeHost
+	// replicaIDs[s][i] is the replica ID of shard s+1 on the i+1-th NodeHost
+	replicaIDs [][]uint64
+	nextID     uint64
+}
+
+func newCluster(cfg Config) (*cluster, error) {
+	c := &cluster{
+		cfg:       cfg,
+		network:   memtransport.NewNetwork(),
+		members:   make(map[uint64]dragonboat.Target),
+		nodeHosts: make([]*dragonboat.NodeHost, cfg.NodeHosts),
+		nextID:    uint64(cfg.NodeHosts) + 1,
+	}
+	c.nhConfigs = c.network.NodeHostConfigs(cfg.NodeHosts,
+		cfg.Dir, cfg.RTTMillisecond)
+	for i := range c.nhConfigs {
+		c.nhConfigs[i].Expert.LogDB = config.GetTinyMemLogDBConfig()
+		c.members[uint64(i+1)] = memtransport.Address(i + 1)
+	}
+	for s := 0; s < cfg.Shards; s++ {
+		ids := make([]uint64, cfg.NodeHosts)
+		for i := range ids {
+			ids[i] = uint64(i + 1)
+		}
+		c.replicaIDs = append(c.replicaIDs, ids)
+	}
+	for i := 1; i <= cfg.NodeHosts; i++ {
+		if err := c.start(i, c.members); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *cluster) replicaConfig(shardID uint64, replicaID uint64) config.Config {
+	return config.Config{
+		ShardID:            shardID,
+		ReplicaID:          replicaID,
+		ElectionRTT:        10,
+		HeartbeatRTT:       1,
+		CheckQuorum:        true,
+		PreVote:            true,
+		SnapshotEntries:    50,
+		CompactionOverhead: 20,
+	}
+}
+
+// start starts the i-th NodeHost and replicas of all shards on it, members
+// are nil when restarting replicas.
+func (c *cluster) start(i int, members map[uint64]dragonboat.Target) error {
+	if err := os.MkdirAll(c.nhConfigs[i-1].NodeHostDir, 0755); err != nil {
+		return err
+	}
+	nh, err := dragonboat.NewNodeHost(c.nhConfigs[i-1])
+	if err != nil {
+		return err
+	}
+	for s := 1; s <= c.cfg.Shards; s++ {
+		rc := c.replicaConfig(uint64(s), c.replicaID(uint64(s), i))
+		if err := nh.StartReplica(members,
+			false, tests.NewHashStateMachine, rc); err != nil {
+			nh.Close()
+			return err
+		}
+	}
+	c.mu.Lock()
+	c.nodeHosts[i-1] = nh
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *cluster) stop(i int) {
+	c.mu.Lock()
+	nh := c.nodeHosts[i-1]
+	c.nodeHosts[i-1] = nil
+	c.mu.Unlock()
+	if nh != nil {
+		nh.Close()
+	}
+}
+
+func (c *cluster) close() {
+	for i := 1; i <= len(c.nodeHosts); i++ {
+		c.stop(i)
+	}
+}
+
+// nodeHost returns the i-th NodeHost, it returns nil when the NodeHost is
+// not running.
+func (c *cluster) nodeHost(i int) *dragonboat.NodeHost {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nodeHosts[i-1]
+}
+
+func (c *cluster) replicaID(shardID uint64, i int) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.replicaIDs[shardID-1][i-1]
+}
+
+func (c *cluster) setReplicaID(shardID uint64, i int, replicaID uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replicaIDs[shardID-1][i-1] = replicaID
+}
+
+// run runs the workload and the monitors until the configured duration has
+// passed or any monitored value exceeds its limit.
+func (c *cluster) run(ctx context.Context, report *Report) error {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Duration)
+	defer cancel()
+	w := newWorkload(c)
+	var wg sync.WaitGroup
+	for i := 0; i < c.cfg.Clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w.client(ctx, c.cfg.Seed+int64(i))
+		}(i)
+	}
+	chaosC := make(chan error, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		chaosC <- w.chaos(ctx, c.cfg.Seed+int64(c.cfg.Clients))
+	}()
+	err := newSampler(c).run(ctx, report)
+	cancel()
+	wg.Wait()
+	report.Operations = w.counts()
+	if err != nil {
+		return err
+	}
+	if err := <-chaosC; err != nil && !errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return nil
+}
+
+// converge waits for all replicas to converge to the same applied index with
+// no pending requests and no snapshot staging bytes left behind.
+func (c *cluster) converge(report *Report) error {
+	for i := 1; i <= len(c.nodeHosts); i++ {
+		if c.nodeHost(i) == nil {
+			if err := c.start(i, nil); err != nil {
+				return err
+			}
+		}
+	}
+	deadline := time.Now().Add(c.cfg.ConvergenceTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	var err error
+	for time.Now().Before(deadline) {
+		if err = c.converged(ctx); err == nil {
+			c.cfg.Logf("replicas converged")
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	report.Violations = append(report.Violations,
+		Violation{Monitor: "convergence", Detail: err.Error()})
+	return errors.Wrapf(ErrNotConverged, "%v", err)
+}
+
+func (c *cluster) converged(ctx context.Context) error {
+	for s := uint64(1); s <= uint64(c.cfg.Shards); s++ {
+		var applied []uint64
+		var states []tests.HashState
+		for i := 1; i <= len(c.nodeHosts); i++ {
+			nh := c.nodeHost(i)
+			d, err := nh.DumpRaftState(ctx, s)
+			if err != nil {
+				return errors.Wrapf(err, "shard %d on NodeHost %d", s, i)
+			}
+			lag, err := nh.GetLocalLag(s)
+			if err != nil {
+				return errors.Wrapf(err, "shard %d on NodeHost %d", s, i)
+			}
+			if d.AppliedIndex != d.CommittedIndex || lag != 0 {
+				return errors.Newf("shard %d on NodeHost %d, applied %d, committed %d",
+					s, i, d.AppliedIndex, d.CommittedIndex)
+			}
+			v, err := nh.StaleRead(s, nil)
+			if err != nil {
+				return errors.Wrapf(err, "shard %d on NodeHost %d", s, i)
+			}
+			applied = append(applied, d.AppliedIndex)
+			states = append(states, v.(tests.HashState))
+		}
+		for j := 1; j < len(applied); j++ {
+			if applied[j] != applied[0] {
+				return errors.Newf("shard %d applied indexes %v", s, applied)
+			}
+			if states[j] != states[0] {
+				return errors.Newf("shard %d state machines diverged, %+v",
+					s, states)
+			}
+		}
+	}
+	for i := 1; i <= len(c.nodeHosts); i++ {
+		nh := c.nodeHost(i)
+		if p := nh.GetEngineStats().Pending; p != (dragonboat.PendingRequestStats{}) {
+			return errors.Newf("NodeHost %d pending requests %+v", i, p)
+		}
+		nhi := nh.GetNodeHostInfo(dragonboat.NodeHostInfoOption{SkipLogInfo: true})
+		if nhi != nil && nhi.SnapshotStaging.Bytes > 0 {
+			return errors.Newf("NodeHost %d snapshot staging bytes %d",
+				i, nhi.SnapshotStaging.Bytes)
+		}
+	}
+	return nil
+}
+
+// Report describes a soak test run.
+type Report struct {
+	Started   time.Time
+	Elapsed   time.Duration
+	NodeHosts int
+	Shards    int
+	// Passed indicates whether the run completed with all monitored values
+	// within the envelope and all replicas converged.
+	Passed bool
+	// Error is the error that failed the run.
+	Error string `json:",omitempty"`
+	// Operations is the number of operations made by the workload.
+	Operations Operations
+	// Samples is the number of samples taken by the monitors.
+	Samples int
+	// Peaks is the peak value of each monitor.
+	Peaks map[string]uint64
+	// Last is the last sample taken by the monitors.
+	Last Sample
+	// Violations are the monitored values that exceeded their limits.
+	Violations []Violation `json:",omitempty"`
+}
+
+func (r *Report) write(fp string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fp, data, 0644)
+}
+
+func (c *cluster) sampleNodeHost(i int, nh *dragonboat.NodeHost) NodeHostSample {
+	stats := nh.GetEngineStats()
+	s := NodeHostSample{
+		NodeHost: i,
+		Memory:   stats.Memory,
+		Pending:  stats.Pending,
+	}
+	opt := dragonboat.NodeHostInfoOption{SkipLogInfo: true}
+	if nhi := nh.GetNodeHostInfo(opt); nhi != nil {
+		s.StagingBytes = nhi.SnapshotStaging.Bytes
+	}
+	for shardID := uint64(1); shardID <= uint64(c.cfg.Shards); shardID++ {
+		// the replica might be being replaced or not yet initialized
+		if lag, err := nh.GetLocalLag(shardID); err == nil && lag > s.MaxApplyLag {
+			s.MaxApplyLag = lag
+		}
+	}
+	return s
+}
@@ -0,0 +1,176 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package soaktest
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/logger"
+)
+
+func TestMain(m *testing.M) {
+	for _, name := range []string{"dragonboat", "raft", "rsm", "transport",
+		"logdb", "config", "registry", "raftpb"} {
+		logger.GetLogger(name).SetLevel(logger.ERROR)
+	}
+	m.Run()
+}
+
+// envelope is loose enough for runs on loaded CI machines while still
+// catching unbounded growth.
+var envelope = Envelope{
+	MaxGoroutineGrowth:      500,
+	MaxHeapBytes:            2 << 30,
+	MaxInMemLogBytes:        256 << 20,
+	MaxPendingProposalBytes: 64 << 20,
+	MaxInboundMessageBytes:  64 << 20,
+	MaxSnapshotChunkBytes:   64 << 20,
+	MaxStagingBytes:         64 << 20,
+	MaxPendingProposals:     1000,
+	MaxPendingReads:         1000,
+	MaxApplyLag:             10000,
+}
+
+func TestCheckReportsViolations(t *testing.T) {
+	peaks := make(map[string]uint64)
+	e := Envelope{MaxGoroutineGrowth: 10, MaxPendingReads: 5}
+	s := Sample{
+		GoroutineGrowth: 3,
+		HeapBytes:       100,
+		NodeHosts: []NodeHostSample{
+			{NodeHost: 1, Pending: dragonboat.PendingRequestStats{Reads: 5}},
+			{NodeHost: 2, Pending: dragonboat.PendingRequestStats{Reads: 6}},
+		},
+	}
+	violations := check(e, s, peaks)
+	if len(violations) != 1 {
+		t.Fatalf("unexpected violations %v", violations)
+	}
+	v := violations[0]
+	if v.Monitor != "pending-reads" || v.NodeHost != 2 ||
+		v.Value != 6 || v.Limit != 5 {
+		t.Errorf("unexpected violation %+v", v)
+	}
+	// values without limits are not checked but their peaks are recorded
+	if peaks["heap-bytes"] != 100 || peaks["pending-reads"] != 6 {
+		t.Errorf("unexpected peaks %v", peaks)
+	}
+	s.GoroutineGrowth = 11
+	if violations := check(e, s, peaks); len(violations) != 2 {
+		t.Errorf("unexpected violations %v", violations)
+	}
+}
+
+func TestRunFailsWhenEnvelopeIsExceeded(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "report.json")
+	cfg := Config{
+		Dir:            t.TempDir(),
+		Duration:       10 * time.Second,
+		Shards:         2,
+		SampleInterval: 100 * time.Millisecond,
+		// exceeded by the first sample
+		Envelope:   Envelope{MaxHeapBytes: 1},
+		ReportPath: fp,
+	}
+	start := time.Now()
+	report, err := Run(context.Background(), cfg)
+	if !errors.Is(err, ErrEnvelopeExceeded) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if time.Since(start) >= cfg.Duration {
+		t.Errorf("run not stopped on violation")
+	}
+	if report.Passed || len(report.Violations) == 0 ||
+		report.Violations[0].Monitor != "heap-bytes" {
+		t.Errorf("unexpected report %+v", report)
+	}
+	data, err := os.ReadFile(fp)
+	if err != nil {
+		t.Fatalf("report not written %v", err)
+	}
+	var written Report
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatalf("failed to unmarshal report %v", err)
+	}
+	if written.Passed || len(written.Violations) != len(report.Violations) {
+		t.Errorf("unexpected written report %+v", written)
+	}
+}
+
+func TestShortSoak(t *testing.T) {
+	cfg := Config{
+		Dir:                      t.TempDir(),
+		Duration:                 10 * time.Second,
+		Shards:                   6,
+		Clients:                  4,
+		SampleInterval:           200 * time.Millisecond,
+		WarmUp:                   time.Second,
+		MembershipChangeInterval: 2 * time.Second,
+		SnapshotInterval:         time.Second,
+		RestartInterval:          4 * time.Second,
+		Envelope:                 envelope,
+		Logf:                     t.Logf,
+	}
+	report, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("soak test failed %v, report %+v", err, report)
+	}
+	ops := report.Operations
+	if ops.Proposals == 0 || ops.SessionProposals == 0 || ops.Reads == 0 ||
+		ops.MembershipChanges == 0 || ops.Snapshots == 0 || ops.Restarts == 0 {
+		t.Errorf("unexpected operations %+v", ops)
+	}
+	if report.Samples == 0 || !report.Passed {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
+
+// TestSoak runs the soak test for the duration specified by the
+// DRAGONBOAT_SOAK_DURATION environment variable, e.g.
+//
+//	DRAGONBOAT_SOAK_DURATION=2h go test -run TestSoak -timeout 3h
+//
+// The JSON report is written to DRAGONBOAT_SOAK_REPORT when it is set.
+func TestSoak(t *testing.T) {
+	v := os.Getenv("DRAGONBOAT_SOAK_DURATION")
+	if len(v) == 0 {
+		t.Skip("DRAGONBOAT_SOAK_DURATION not set")
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		t.Fatalf("invalid DRAGONBOAT_SOAK_DURATION %v", err)
+	}
+	cfg := Config{
+		Dir:        t.TempDir(),
+		Duration:   d,
+		Shards:     48,
+		Envelope:   envelope,
+		ReportPath: os.Getenv("DRAGONBOAT_SOAK_REPORT"),
+		Logf:       t.Logf,
+		Seed:       time.Now().UnixNano(),
+	}
+	t.Logf("seed %d", cfg.Seed)
+	if _, err := Run(context.Background(), cfg); err != nil {
+		t.Fatalf("soak test failed %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package soaktest
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/internal/tests"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+)
+
+const (
+	requestTimeout = 3 * time.Second
+)
+
+// Operations contains the numbers of operations made by the workload.
+type Operations struct {
+	// Proposals is the number of completed proposals made with the NO-OP
+	// session.
+	Proposals uint64
+	// SessionProposals is the number of completed proposals made with
+	// registered client sessions.
+	SessionProposals uint64
+	// Reads is the number of completed linearizable reads.
+	Reads uint64
+	// MembershipChanges is the number of replicas replaced.
+	MembershipChanges uint64
+	// Snapshots is the number of completed snapshot requests.
+	Snapshots uint64
+	// Restarts is the number of NodeHost restarts.
+	Restarts uint64
+	// Failed is the number of failed client requests, requests are expected to
+	// fail from time to time as replicas and NodeHosts are being restarted.
+	Failed uint64
+}
+
+type workload struct {
+	c   *cluster
+	ops Operations
+}
+
+func newWorkload(c *cluster) *workload {
+	return &workload{c: c}
+}
+
+func (w *workload) counts() Operations {
+	return Operations{
+		Proposals:         atomic.LoadUint64(&w.ops.Proposals),
+		SessionProposals:  atomic.LoadUint64(&w.ops.SessionProposals),
+		Reads:             atomic.LoadUint64(&w.ops.Reads),
+		MembershipChanges: atomic.LoadUint64(&w.ops.MembershipChanges),
+		Snapshots:         atomic.LoadUint64(&w.ops.Snapshots),
+		Restarts:          atomic.LoadUint64(&w.ops.Restarts),
+		Failed:            atomic.LoadUint64(&w.ops.Failed),
+	}
+}
+
+func (w *workload) done(counter *uint64, err error) {
+	if err != nil {
+		atomic.AddUint64(&w.ops.Failed, 1)
+		return
+	}
+	atomic.AddUint64(counter, 1)
+}
+
+// client makes proposals and reads on randomly selected shards through
+// randomly selected NodeHosts until ctx is done.
+func (w *workload) client(ctx context.Context, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	sessions := make(map[uint64]*client.Session)
+	for ctx.Err() == nil {
+		shardID := uint64(rng.Intn(w.c.cfg.Shards) + 1)
+		nh := w.c.nodeHost(rng.Intn(w.c.cfg.NodeHosts) + 1)
+		if nh == nil {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		cmd := make([]byte, 16+rng.Intn(240))
+		rng.Read(cmd)
+		rctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		switch rng.Intn(4) {
+		case 0:
+			_, err := nh.SyncRead(rctx, shardID, nil)
+			w.done(&w.ops.Reads, err)
+		case 1:
+			w.done(&w.ops.SessionProposals,
+				w.sessionPropose(rctx, nh, sessions, shardID, cmd))
+		default:
+			_, err := nh.SyncPropose(rctx, nh.GetNoOPSession(shardID), cmd)
+			w.done(&w.ops.Proposals, err)
+		}
+		cancel()
+	}
+}
+
+// sessionPropose makes a proposal using the client session of the shard, the
+// session is registered first when required. Failed proposals are retried
+// with the same session on the next attempt as suggested by SyncPropose.
+func (w *workload) sessionPropose(ctx context.Context, nh *dragonboat.NodeHost,
+	sessions map[uint64]*client.Session, shardID uint64, cmd []byte) error {
+	s, ok := sessions[shardID]
+	if !ok {
+		var err error
+		if s, err = nh.SyncGetSession(ctx, shardID); err != nil {
+			return err
+		}
+		sessions[shardID] = s
+	}
+	if _, err := nh.SyncPropose(ctx, s, cmd); err != nil {
+		if errors.Is(err, dragonboat.ErrInvalidSession) {
+			delete(sessions, shardID)
+		}
+		return err
+	}
+	s.ProposalCompleted()
+	return nil
+}
+
+// chaos periodically replaces replicas, requests snapshots and restarts
+// NodeHosts until ctx is done. Each operation is completed even when ctx is
+// done in the middle of it so replicas can converge afterwards.
+func (w *workload) chaos(ctx context.Context, seed int64) error {
+	rng := rand.New(rand.NewSource(seed))
+	ticker := func(d time.Duration) <-chan time.Time {
+		if d < 0 {
+			return nil
+		}
+		t := time.NewTicker(d)
+		go func() {
+			<-ctx.Done()
+			t.Stop()
+		}()
+		return t.C
+	}
+	membershipC := ticker(w.c.cfg.MembershipChangeInterval)
+	snapshotC := ticker(w.c.cfg.SnapshotInterval)
+	restartC := ticker(w.c.cfg.RestartInterval)
+	for {
+		shardID := uint64(rng.Intn(w.c.cfg.Shards) + 1)
+		i := rng.Intn(w.c.cfg.NodeHosts) + 1
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-membershipC:
+			if err := w.c.replaceReplica(shardID, i); err != nil {
+				return errors.Wrapf(err, "failed to replace replica of shard %d "+
+					"on NodeHost %d", shardID, i)
+			}
+			atomic.AddUint64(&w.ops.MembershipChanges, 1)
+		case <-snapshotC:
+			nh := w.c.nodeHost(i)
+			rctx, cancel := context.WithTimeout(ctx, requestTimeout)
+			_, err := nh.SyncRequestSnapshot(rctx,
+				shardID, dragonboat.SnapshotOption{})
+			cancel()
+			w.done(&w.ops.Snapshots, err)
+		case <-restartC:
+			w.c.cfg.Logf("restarting NodeHost %d", i)
+			w.c.stop(i)
+			if err := w.c.start(i, nil); err != nil {
+				return errors.Wrapf(err, "failed to restart NodeHost %d", i)
+			}
+			atomic.AddUint64(&w.ops.Restarts, 1)
+		}
+	}
+}
+
+// retry retries f until it succeeds or ConvergenceTimeout has passed.
+func (c *cluster) retry(f func(ctx context.Context) error) error {
+	deadline := time.Now().Add(c.cfg.ConvergenceTimeout)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		err := f(ctx)
+		cancel()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// replaceReplica replaces the replica of the shard on the i-th NodeHost with
+// a new replica with a new replica ID.
+func (c *cluster) replaceReplica(shardID uint64, i int) error {
+	nh := c.nodeHost(i)
+	// membership changes are requested through another NodeHost as the local
+	// replica is removed
+	peer := c.nodeHost(i%c.cfg.NodeHosts + 1)
+	old := c.replicaID(shardID, i)
+	c.mu.Lock()
+	replicaID := c.nextID
+	c.nextID++
+	c.mu.Unlock()
+	c.cfg.Logf("replacing replica %d of shard %d on NodeHost %d with %d",
+		old, shardID, i, replicaID)
+	// membership is checked before each attempt as a timed out request might
+	// have been completed
+	if err := c.retry(func(ctx context.Context) error {
+		m, err := peer.SyncGetShardMembership(ctx, shardID)
+		if err != nil {
+			return err
+		}
+		if _, ok := m.Nodes[old]; !ok {
+			return nil
+		}
+		return peer.SyncRequestDeleteReplica(ctx, shardID, old, m.ConfigChangeID)
+	}); err != nil {
+		return err
+	}
+	if err := c.retry(func(ctx context.Context) error {
+		err := nh.StopReplica(shardID, old)
+		if err != nil && !errors.Is(err, dragonboat.ErrShardNotFound) {
+			return err
+		}
+		return nh.SyncRemoveData(ctx, shardID, old)
+	}); err != nil {
+		return err
+	}
+	target := memtransport.Address(i)
+	if err := c.retry(func(ctx context.Context) error {
+		m, err := peer.SyncGetShardMembership(ctx, shardID)
+		if err != nil {
+			return err
+		}
+		if _, ok := m.Nodes[replicaID]; ok {
+			return nil
+		}
+		return peer.SyncRequestAddReplica(ctx,
+			shardID, replicaID, target, m.ConfigChangeID)
+	}); err != nil {
+		return err
+	}
+	c.setReplicaID(shardID, i, replicaID)
+	return nh.StartReplica(nil,
+		true, tests.NewHashStateMachine, c.replicaConfig(shardID, replicaID))
+}
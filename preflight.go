@@ -0,0 +1,417 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+const (
+	preflightProbeFilename = "dragonboat.preflight"
+	preflightProbeSize     = 4096
+	preflightLookupTimeout = 5 * time.Second
+)
+
+var (
+	// ErrNotDirectory indicates that the specified data directory is not a
+	// directory.
+	ErrNotDirectory = errors.New("not a directory")
+	// ErrDirectoryLocked indicates that the data directory is locked by another
+	// NodeHost instance.
+	ErrDirectoryLocked = server.ErrLockDirectory
+	// ErrFsyncNotDurable indicates that data read back from a synced file
+	// doesn't match the written data.
+	ErrFsyncNotDurable = errors.New("synced data not durable")
+	// ErrVolatileFilesystem indicates that the data directory is on a memory
+	// backed file system, e.g. tmpfs, data stored in it is lost on reboot.
+	ErrVolatileFilesystem = errors.New("memory backed file system")
+	// ErrInsufficientDiskSpace indicates that the free disk space is below
+	// DiskMonitor.CriticalFreeBytes.
+	ErrInsufficientDiskSpace = errors.New("insufficient disk space")
+)
+
+// PreflightCheckType is the type of a check performed by PreflightCheck.
+type PreflightCheckType int
+
+const (
+	// PreflightDirectory checks that the data directory exists or can be
+	// created and that it is writable.
+	PreflightDirectory PreflightCheckType = iota
+	// PreflightFsync checks that data written to the data directory can be
+	// synced and read back.
+	PreflightFsync
+	// PreflightFilesystem checks that the data directory is not on a memory
+	// backed file system.
+	PreflightFilesystem
+	// PreflightDiskSpace checks the free disk space of the data directory.
+	PreflightDiskSpace
+	// PreflightDirectoryLock checks that the data directory is not locked by
+	// another process, stale locks left by killed processes are reported.
+	PreflightDirectoryLock
+	// PreflightRaftAddress checks that the RaftAddress can be resolved.
+	PreflightRaftAddress
+	// PreflightListen checks that the listen addresses can be bound.
+	PreflightListen
+	// PreflightTLS checks that the TLS files can be loaded.
+	PreflightTLS
+)
+
+var preflightCheckTypeNames = [...]string{
+	PreflightDirectory:     "Directory",
+	PreflightFsync:         "Fsync",
+	PreflightFilesystem:    "Filesystem",
+	PreflightDiskSpace:     "DiskSpace",
+	PreflightDirectoryLock: "DirectoryLock",
+	PreflightRaftAddress:   "RaftAddress",
+	PreflightListen:        "Listen",
+	PreflightTLS:           "TLS",
+}
+
+func (t PreflightCheckType) String() string {
+	if t < PreflightDirectory || t > PreflightTLS {
+		return fmt.Sprintf("PreflightCheckType(%d)", int(t))
+	}
+	return preflightCheckTypeNames[t]
+}
+
+// PreflightResult is the result of a check performed by PreflightCheck.
+type PreflightResult struct {
+	// Check is the type of the check.
+	Check PreflightCheckType
+	// Target is the directory, address or file that has been checked.
+	Target string
+	// Detail describes what has been observed, e.g. the free disk space.
+	Detail string
+	// PID is the PID of the process holding the directory lock, or the PID of
+	// the process that exited without releasing it. It is only set for
+	// PreflightDirectoryLock results.
+	PID int
+	// Err is the reason of the failure, it is nil when the check passed.
+	Err error
+}
+
+// Passed returns a boolean value indicating whether the check passed.
+func (r PreflightResult) Passed() bool {
+	return r.Err == nil
+}
+
+func (r PreflightResult) String() string {
+	status, msg := "PASS", r.Detail
+	if !r.Passed() {
+		status, msg = "FAIL", r.Err.Error()
+	}
+	if len(msg) == 0 {
+		return fmt.Sprintf("%s %s %s", status, r.Check, r.Target)
+	}
+	return fmt.Sprintf("%s %s %s: %s", status, r.Check, r.Target, msg)
+}
+
+// PreflightReport is the report of all checks performed by PreflightCheck.
+type PreflightReport struct {
+	Results []PreflightResult
+}
+
+// Passed returns a boolean value indicating whether all checks passed.
+func (r *PreflightReport) Passed() bool {
+	return len(r.Failed()) == 0
+}
+
+// Failed returns the results of failed checks.
+func (r *PreflightReport) Failed() []PreflightResult {
+	var failed []PreflightResult
+	for _, result := range r.Results {
+		if !result.Passed() {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+func (r *PreflightReport) String() string {
+	lines := make([]string, 0, len(r.Results))
+	for _, result := range r.Results {
+		lines = append(lines, result.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// PreflightError is the error returned when some preflight checks failed,
+// Report contains results of all performed checks.
+type PreflightError struct {
+	Report *PreflightReport
+}
+
+func (e *PreflightError) Error() string {
+	failed := e.Report.Failed()
+	return fmt.Sprintf("%d preflight check(s) failed, %s",
+		len(failed), failed[0])
+}
+
+// Unwrap returns the reason of the first failed check.
+func (e *PreflightError) Unwrap() error {
+	return e.Report.Failed()[0].Err
+}
+
+// PreflightCheck validates the environment required by a NodeHost instance
+// created using the specified config without creating the NodeHost. It checks
+// that the NodeHostDir and the WALDir exist or can be created, that they are
+// writable and not locked by another process, that fsync works on them and
+// that they are not on memory backed file systems. When
+// DiskMonitor.CriticalFreeBytes is set, the free disk space is also required
+// to be above it. When the built-in transport module is used, it checks that
+// the RaftAddress can be resolved and that the listen addresses can be bound.
+// TLS files are loaded when MutualTLS is enabled.
+//
+// The returned report contains results of all performed checks, a
+// *PreflightError wrapping the report is returned when any check failed.
+// Set NodeHostConfig.RunPreflightCheck to have it performed by NewNodeHost.
+func PreflightCheck(cfg config.NodeHostConfig) (*PreflightReport, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Prepare(); err != nil {
+		return nil, err
+	}
+	return newPreflight(cfg).run()
+}
+
+type preflight struct {
+	cfg      config.NodeHostConfig
+	fs       vfs.IFS
+	usage    diskUsageFunc
+	isTmpfs  func(path string) (bool, error)
+	resolver config.HostResolver
+	listen   func(network string, address string) (net.Listener, error)
+	report   PreflightReport
+}
+
+func newPreflight(cfg config.NodeHostConfig) *preflight {
+	p := &preflight{
+		cfg:      cfg,
+		fs:       cfg.Expert.FS,
+		usage:    cfg.Expert.FS.GetDiskUsage,
+		isTmpfs:  func(string) (bool, error) { return false, nil },
+		resolver: net.DefaultResolver,
+		listen:   net.Listen,
+	}
+	// paths of other file systems, e.g. the memory based one used in tests,
+	// don't exist on the host
+	if cfg.Expert.FS == vfs.DefaultFS {
+		p.isTmpfs = fileutil.IsTmpfs
+	}
+	return p
+}
+
+func (p *preflight) run() (*PreflightReport, error) {
+	dirs := []string{p.cfg.NodeHostDir}
+	if len(p.cfg.WALDir) > 0 && p.cfg.WALDir != p.cfg.NodeHostDir {
+		dirs = append(dirs, p.cfg.WALDir)
+	}
+	for _, dir := range dirs {
+		p.checkDir(dir)
+	}
+	p.checkAddresses()
+	p.checkTLS()
+	if !p.report.Passed() {
+		return &p.report, &PreflightError{Report: &p.report}
+	}
+	return &p.report, nil
+}
+
+func (p *preflight) add(check PreflightCheckType,
+	target string, detail string, err error) {
+	p.report.Results = append(p.report.Results, PreflightResult{
+		Check:  check,
+		Target: target,
+		Detail: detail,
+		Err:    err,
+	})
+}
+
+func (p *preflight) checkDir(dir string) {
+	existing, err := p.getExistingDir(dir)
+	if err != nil {
+		p.add(PreflightDirectory, dir, "", err)
+		return
+	}
+	// directories to be created are checked using their closest existing
+	// parent directory
+	fp := p.fs.PathJoin(existing, preflightProbeFilename)
+	f, err := p.fs.Create(fp)
+	if err != nil {
+		p.add(PreflightDirectory, dir, "",
+			errors.Wrapf(err, "%s not writable", existing))
+		return
+	}
+	detail := "exists"
+	if existing != dir {
+		detail = fmt.Sprintf("to be created in %s", existing)
+	}
+	p.add(PreflightDirectory, dir, detail, nil)
+	p.add(PreflightFsync, dir, "", p.probe(f, fp))
+	p.checkFilesystem(dir, existing)
+	p.checkDiskSpace(dir, existing)
+	if existing == dir {
+		p.checkLock(dir)
+	}
+}
+
+// getExistingDir returns the specified directory or its closest existing
+// parent directory when it doesn't exist.
+func (p *preflight) getExistingDir(dir string) (string, error) {
+	for {
+		fi, err := p.fs.Stat(dir)
+		if err == nil {
+			if !fi.IsDir() {
+				return "", errors.Wrapf(ErrNotDirectory, "%s", dir)
+			}
+			return dir, nil
+		}
+		if !vfs.IsNotExist(err) {
+			return "", err
+		}
+		parent := p.fs.PathDir(dir)
+		if parent == dir {
+			return "", err
+		}
+		dir = parent
+	}
+}
+
+// probe writes, syncs and reads back the specified probe file, which is
+// always removed afterwards.
+func (p *preflight) probe(f vfs.File, fp string) (err error) {
+	defer func() {
+		err = firstError(err, p.fs.Remove(fp))
+	}()
+	data := make([]byte, preflightProbeSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err := firstError(err, f.Close()); err != nil {
+		return err
+	}
+	if err := fileutil.SyncDir(p.fs.PathDir(fp), p.fs); err != nil {
+		return err
+	}
+	r, err := p.fs.Open(fp)
+	if err != nil {
+		return err
+	}
+	read, err := fileutil.ReadAll(r)
+	if err := firstError(err, r.Close()); err != nil {
+		return err
+	}
+	if !bytes.Equal(data, read) {
+		return ErrFsyncNotDurable
+	}
+	return nil
+}
+
+func (p *preflight) checkFilesystem(dir string, existing string) {
+	tmpfs, err := p.isTmpfs(existing)
+	if err == nil && tmpfs {
+		err = errors.Wrapf(ErrVolatileFilesystem, "%s", existing)
+	}
+	p.add(PreflightFilesystem, dir, "", err)
+}
+
+func (p *preflight) checkDiskSpace(dir string, existing string) {
+	required := p.cfg.DiskMonitor.CriticalFreeBytes
+	du, err := p.usage(existing)
+	if err != nil {
+		// free disk space is only required to be known when there is a minimum
+		if required == 0 {
+			p.add(PreflightDiskSpace, dir, fmt.Sprintf("unknown, %v", err), nil)
+		} else {
+			p.add(PreflightDiskSpace, dir, "", err)
+		}
+		return
+	}
+	detail := fmt.Sprintf("%d bytes available", du.AvailBytes)
+	if du.AvailBytes < required {
+		err = errors.Wrapf(ErrInsufficientDiskSpace,
+			"%d bytes available, %d bytes required", du.AvailBytes, required)
+	}
+	p.add(PreflightDiskSpace, dir, detail, err)
+}
+
+func (p *preflight) checkLock(dir string) {
+	pid, stale, err := server.CheckDirLock(dir, p.fs)
+	r := PreflightResult{
+		Check:  PreflightDirectoryLock,
+		Target: dir,
+		PID:    pid,
+	}
+	if err != nil {
+		if errors.Is(err, ErrDirectoryLocked) && pid > 0 {
+			err = errors.Wrapf(err, "held by PID %d", pid)
+		}
+		r.Err = err
+	} else if stale {
+		r.Detail = fmt.Sprintf("stale lock left by PID %d", pid)
+	}
+	p.report.Results = append(p.report.Results, r)
+}
+
+func (p *preflight) checkAddresses() {
+	// custom transport modules define their own address formats
+	if p.cfg.Expert.TransportFactory != nil {
+		return
+	}
+	addr := p.cfg.RaftAddress
+	host, _, err := net.SplitHostPort(addr)
+	detail := ""
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			preflightLookupTimeout)
+		var addrs []string
+		addrs, err = p.resolver.LookupHost(ctx, host)
+		cancel()
+		detail = strings.Join(addrs, ",")
+	}
+	p.add(PreflightRaftAddress, addr, detail, err)
+	for _, la := range p.cfg.GetListenAddresses() {
+		l, err := p.listen("tcp", la)
+		if err == nil {
+			err = l.Close()
+		}
+		p.add(PreflightListen, la, "", err)
+	}
+}
+
+func (p *preflight) checkTLS() {
+	if !p.cfg.MutualTLS {
+		return
+	}
+	_, err := p.cfg.GetServerTLSConfig()
+	p.add(PreflightTLS, p.cfg.CertFile, "", err)
+}
@@ -0,0 +1,303 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	gvfs "github.com/lni/vfs"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+type failedResolver struct{}
+
+func (failedResolver) LookupHost(ctx context.Context,
+	host string) ([]string, error) {
+	return nil, errors.Newf("no such host %s", host)
+}
+
+func getPreflightTestConfig(t *testing.T, fs vfs.IFS) config.NodeHostConfig {
+	// t.TempDir() might be on tmpfs
+	dir, err := filepath.Abs(singleNodeHostTestDir)
+	if err != nil {
+		t.Fatalf("failed to get dir %v", err)
+	}
+	_ = fs.RemoveAll(dir)
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("failed to create dir %v", err)
+	}
+	t.Cleanup(func() { _ = fs.RemoveAll(dir) })
+	cfg := config.NodeHostConfig{
+		NodeHostDir:    filepath.Join(dir, "nh"),
+		WALDir:         filepath.Join(dir, "wal"),
+		RTTMillisecond: 1,
+		RaftAddress:    nodeHostTestAddr1,
+		Expert:         config.ExpertConfig{FS: fs},
+	}
+	if err := cfg.Prepare(); err != nil {
+		t.Fatalf("failed to prepare config %v", err)
+	}
+	return cfg
+}
+
+func runPreflight(t *testing.T, cfg config.NodeHostConfig,
+	f func(p *preflight)) *PreflightReport {
+	p := newPreflight(cfg)
+	if f != nil {
+		f(p)
+	}
+	report, err := p.run()
+	if report.Passed() != (err == nil) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return report
+}
+
+func checkPreflightFailure(t *testing.T, report *PreflightReport,
+	check PreflightCheckType, target string, reason error) {
+	failed := report.Failed()
+	if len(failed) != 1 {
+		t.Fatalf("unexpected failures\n%s", report)
+	}
+	if failed[0].Check != check || failed[0].Target != target {
+		t.Errorf("unexpected failure %s", failed[0])
+	}
+	if reason != nil && !errors.Is(failed[0].Err, reason) {
+		t.Errorf("unexpected reason %v", failed[0].Err)
+	}
+}
+
+func TestPreflightCheckPassesOnHealthyEnvironment(t *testing.T) {
+	fs := vfs.GetTestFS()
+	cfg := getPreflightTestConfig(t, fs)
+	report, err := PreflightCheck(cfg)
+	if err != nil {
+		t.Fatalf("preflight check failed %v\n%s", err, report)
+	}
+	checks := make(map[PreflightCheckType]int)
+	for _, r := range report.Results {
+		checks[r.Check]++
+	}
+	for _, check := range []PreflightCheckType{PreflightDirectory,
+		PreflightFsync, PreflightFilesystem, PreflightDiskSpace} {
+		if checks[check] != 2 {
+			t.Errorf("%s not checked for both directories\n%s", check, report)
+		}
+	}
+	// the directories don't exist yet, they are not locked by anyone
+	if checks[PreflightDirectoryLock] != 0 ||
+		checks[PreflightRaftAddress] != 1 || checks[PreflightListen] != 1 {
+		t.Errorf("unexpected checks\n%s", report)
+	}
+	for _, dir := range []string{cfg.NodeHostDir, cfg.WALDir} {
+		if _, err := fs.Stat(dir); !vfs.IsNotExist(err) {
+			t.Errorf("%s created by preflight check, %v", dir, err)
+		}
+	}
+	fp := fs.PathJoin(fs.PathDir(cfg.NodeHostDir), preflightProbeFilename)
+	if _, err := fs.Stat(fp); !vfs.IsNotExist(err) {
+		t.Errorf("probe file not removed, %v", err)
+	}
+}
+
+func TestPreflightCheckDetectsInvalidDirectory(t *testing.T) {
+	fs := vfs.GetTestFS()
+	cfg := getPreflightTestConfig(t, fs)
+	f, err := fs.Create(cfg.WALDir)
+	if err != nil {
+		t.Fatalf("failed to create file %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close file %v", err)
+	}
+	report := runPreflight(t, cfg, nil)
+	checkPreflightFailure(t, report, PreflightDirectory, cfg.WALDir,
+		ErrNotDirectory)
+}
+
+func TestPreflightCheckDetectsReadOnlyDirectory(t *testing.T) {
+	cfg := getPreflightTestConfig(t, vfs.GetTestFS())
+	cfg.Expert.FS = vfs.Wrap(vfs.GetTestFS(), vfs.OnIndex(0, vfs.OpWrite))
+	report := runPreflight(t, cfg, nil)
+	checkPreflightFailure(t, report, PreflightDirectory, cfg.NodeHostDir, nil)
+}
+
+func TestPreflightCheckDetectsBrokenFsync(t *testing.T) {
+	cfg := getPreflightTestConfig(t, vfs.GetTestFS())
+	cfg.Expert.FS = vfs.Wrap(vfs.GetTestFS(), vfs.OnIndex(0, vfs.OpSync))
+	report := runPreflight(t, cfg, nil)
+	checkPreflightFailure(t, report, PreflightFsync, cfg.NodeHostDir, nil)
+	fp := cfg.Expert.FS.PathJoin(cfg.Expert.FS.PathDir(cfg.NodeHostDir),
+		preflightProbeFilename)
+	if _, err := cfg.Expert.FS.Stat(fp); !vfs.IsNotExist(err) {
+		t.Errorf("probe file not removed, %v", err)
+	}
+}
+
+func TestPreflightCheckDetectsVolatileWALDir(t *testing.T) {
+	cfg := getPreflightTestConfig(t, vfs.GetTestFS())
+	if err := cfg.Expert.FS.MkdirAll(cfg.WALDir, 0755); err != nil {
+		t.Fatalf("failed to create dir %v", err)
+	}
+	report := runPreflight(t, cfg, func(p *preflight) {
+		p.isTmpfs = func(path string) (bool, error) {
+			return path == cfg.WALDir, nil
+		}
+	})
+	checkPreflightFailure(t, report, PreflightFilesystem, cfg.WALDir,
+		ErrVolatileFilesystem)
+}
+
+func TestPreflightCheckDetectsInsufficientDiskSpace(t *testing.T) {
+	cfg := getPreflightTestConfig(t, vfs.GetTestFS())
+	cfg.WALDir = ""
+	cfg.DiskMonitor.CriticalFreeBytes = 1024
+	usage := func(path string) (gvfs.DiskUsage, error) {
+		return gvfs.DiskUsage{AvailBytes: 1023}, nil
+	}
+	report := runPreflight(t, cfg, func(p *preflight) { p.usage = usage })
+	checkPreflightFailure(t, report, PreflightDiskSpace, cfg.NodeHostDir,
+		ErrInsufficientDiskSpace)
+	// the disk usage is required to be known when there is a minimum
+	usage = func(path string) (gvfs.DiskUsage, error) {
+		return gvfs.DiskUsage{}, errors.New("not supported")
+	}
+	report = runPreflight(t, cfg, func(p *preflight) { p.usage = usage })
+	checkPreflightFailure(t, report, PreflightDiskSpace, cfg.NodeHostDir, nil)
+	cfg.DiskMonitor.CriticalFreeBytes = 0
+	if report := runPreflight(t, cfg, func(p *preflight) {
+		p.usage = usage
+	}); !report.Passed() {
+		t.Errorf("unexpected failures\n%s", report)
+	}
+}
+
+func TestPreflightCheckReportsDirectoryLock(t *testing.T) {
+	fs := vfs.GetTestFS()
+	cfg := getPreflightTestConfig(t, fs)
+	cfg.WALDir = ""
+	env, err := server.NewEnv(cfg, fs)
+	if err != nil {
+		t.Fatalf("failed to create env %v", err)
+	}
+	if _, _, err := env.CreateNodeHostDir(cfg.GetDeploymentID()); err != nil {
+		t.Fatalf("failed to create dir %v", err)
+	}
+	if err := env.LockNodeHostDir(); err != nil {
+		t.Fatalf("failed to lock dir %v", err)
+	}
+	report := runPreflight(t, cfg, nil)
+	checkPreflightFailure(t, report, PreflightDirectoryLock, cfg.NodeHostDir,
+		ErrDirectoryLocked)
+	if pid := report.Failed()[0].PID; pid != os.Getpid() {
+		t.Errorf("unexpected lock owner %d", pid)
+	}
+	if err := env.Close(); err != nil {
+		t.Fatalf("failed to close env %v", err)
+	}
+	// the owner of the lock killed without releasing it
+	f, err := fs.Create(fs.PathJoin(cfg.NodeHostDir, "LOCK.OWNER"))
+	if err != nil {
+		t.Fatalf("failed to create file %v", err)
+	}
+	if _, err := f.Write([]byte("12345")); err != nil {
+		t.Fatalf("failed to write %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close file %v", err)
+	}
+	report = runPreflight(t, cfg, nil)
+	if !report.Passed() {
+		t.Fatalf("unexpected failures\n%s", report)
+	}
+	for _, r := range report.Results {
+		if r.Check == PreflightDirectoryLock && r.PID != 12345 {
+			t.Errorf("stale lock not reported, %s", r)
+		}
+	}
+}
+
+func TestPreflightCheckDetectsUnresolvableRaftAddress(t *testing.T) {
+	cfg := getPreflightTestConfig(t, vfs.GetTestFS())
+	report := runPreflight(t, cfg, func(p *preflight) {
+		p.resolver = failedResolver{}
+	})
+	checkPreflightFailure(t, report, PreflightRaftAddress, cfg.RaftAddress, nil)
+	cfg.RaftAddress = "localhost"
+	report = runPreflight(t, cfg, nil)
+	if len(report.Failed()) == 0 ||
+		report.Failed()[0].Check != PreflightRaftAddress {
+		t.Errorf("invalid address not reported\n%s", report)
+	}
+}
+
+func TestPreflightCheckDetectsUnavailableListenAddress(t *testing.T) {
+	cfg := getPreflightTestConfig(t, vfs.GetTestFS())
+	l, err := net.Listen("tcp", cfg.RaftAddress)
+	if err != nil {
+		t.Fatalf("failed to listen %v", err)
+	}
+	defer l.Close()
+	report := runPreflight(t, cfg, nil)
+	checkPreflightFailure(t, report, PreflightListen, cfg.RaftAddress, nil)
+}
+
+func TestPreflightCheckDetectsInvalidTLSFiles(t *testing.T) {
+	cfg := getPreflightTestConfig(t, vfs.GetTestFS())
+	dir := t.TempDir()
+	cfg.MutualTLS = true
+	cfg.CAFile = filepath.Join(dir, "ca.crt")
+	cfg.CertFile = filepath.Join(dir, "node.crt")
+	cfg.KeyFile = filepath.Join(dir, "node.key")
+	for _, fn := range []string{cfg.CAFile, cfg.CertFile, cfg.KeyFile} {
+		if err := os.WriteFile(fn, []byte("invalid"), 0600); err != nil {
+			t.Fatalf("failed to write file %v", err)
+		}
+	}
+	report := runPreflight(t, cfg, nil)
+	checkPreflightFailure(t, report, PreflightTLS, cfg.CertFile, nil)
+}
+
+func TestNewNodeHostFailsWhenPreflightCheckFails(t *testing.T) {
+	fs := vfs.GetTestFS()
+	cfg := getPreflightTestConfig(t, fs)
+	cfg.RunPreflightCheck = true
+	f, err := fs.Create(cfg.NodeHostDir)
+	if err != nil {
+		t.Fatalf("failed to create file %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close file %v", err)
+	}
+	nh, err := NewNodeHost(cfg)
+	if err == nil {
+		nh.Close()
+		t.Fatalf("NewNodeHost unexpectedly succeeded")
+	}
+	var pe *PreflightError
+	if !errors.As(err, &pe) || !errors.Is(err, ErrNotDirectory) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	checkPreflightFailure(t, pe.Report, PreflightDirectory, cfg.NodeHostDir,
+		ErrNotDirectory)
+}
@@ -0,0 +1,79 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"runtime/pprof"
+	"strconv"
+)
+
+const (
+	// profiler label keys
+	roleLabel      = "role"
+	workerIDLabel  = "workerid"
+	shardIDLabel   = "shardid"
+	replicaIDLabel = "replicaid"
+)
+
+const (
+	// roles of long-lived goroutines
+	stepWorkerRole     = "step"
+	commitWorkerRole   = "commit"
+	applyWorkerRole    = "apply"
+	snapshotWorkerRole = "snapshot"
+	snapshotPoolRole   = "snapshot-pool"
+	closeWorkerRole    = "close"
+	closePoolRole      = "close-pool"
+	tickWorkerRole     = "tick"
+	nodeMonitorRole    = "node-monitor"
+	diskMonitorRole    = "disk-monitor"
+	listenerRole       = "listener"
+)
+
+// workerLabels is used by long-lived worker goroutines for labelling the
+// work they do on behalf of individual shards. The zero value is disabled,
+// all labels are ignored in that case.
+type workerLabels struct {
+	ctx     context.Context
+	enabled bool
+}
+
+// newWorkerLabels labels the calling goroutine with the specified role and
+// worker ID when enabled. It must be invoked by the labelled goroutine.
+func newWorkerLabels(enabled bool, role string, workerID uint64) workerLabels {
+	if !enabled {
+		return workerLabels{}
+	}
+	ctx := pprof.WithLabels(context.Background(), pprof.Labels(roleLabel, role,
+		workerIDLabel, strconv.FormatUint(workerID, 10)))
+	pprof.SetGoroutineLabels(ctx)
+	return workerLabels{ctx: ctx, enabled: true}
+}
+
+// do invokes f with the shard and replica IDs of n added to the labels of the
+// calling goroutine, the goroutine labels are restored when f returns.
+func (l workerLabels) do(n *node, f func()) {
+	if !l.enabled {
+		f()
+		return
+	}
+	pprof.Do(l.ctx, n.profilerLabels, func(context.Context) { f() })
+}
+
+func getShardProfilerLabels(shardID uint64, replicaID uint64) pprof.LabelSet {
+	return pprof.Labels(shardIDLabel, strconv.FormatUint(shardID, 10),
+		replicaIDLabel, strconv.FormatUint(replicaID, 10))
+}
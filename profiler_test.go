@@ -0,0 +1,207 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// cpuBoundSM burns CPU cycles in its Update method so the apply worker is
+// sampled by the CPU profiler.
+type cpuBoundSM struct {
+	PST
+}
+
+func (s *cpuBoundSM) Update(e sm.Entry) (sm.Result, error) {
+	start := time.Now()
+	for time.Since(start) < time.Millisecond {
+	}
+	return s.PST.Update(e)
+}
+
+// protoField is a field of a protobuf encoded message.
+type protoField struct {
+	num   uint64
+	value uint64
+	data  []byte
+}
+
+func decodeProtoFields(t *testing.T, data []byte) []protoField {
+	var result []protoField
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatalf("invalid tag")
+		}
+		data = data[n:]
+		f := protoField{num: tag >> 3}
+		switch tag & 7 {
+		case 0:
+			f.value, n = binary.Uvarint(data)
+			if n <= 0 {
+				t.Fatalf("invalid varint")
+			}
+			data = data[n:]
+		case 1:
+			data = data[8:]
+		case 2:
+			sz, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < sz {
+				t.Fatalf("invalid length")
+			}
+			f.data = data[n : n+int(sz)]
+			data = data[n+int(sz):]
+		case 5:
+			data = data[4:]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+		result = append(result, f)
+	}
+	return result
+}
+
+// getSampleLabels returns the string labels of all samples in the specified
+// gzipped profile.proto.
+func getSampleLabels(t *testing.T, profile []byte) []map[string]string {
+	r, err := gzip.NewReader(bytes.NewReader(profile))
+	if err != nil {
+		t.Fatalf("failed to create reader, %v", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read profile, %v", err)
+	}
+	// see profile.proto in github.com/google/pprof for field numbers
+	var strs []string
+	var samples []protoField
+	for _, f := range decodeProtoFields(t, data) {
+		if f.num == 2 {
+			samples = append(samples, f)
+		} else if f.num == 6 {
+			strs = append(strs, string(f.data))
+		}
+	}
+	var result []map[string]string
+	for _, s := range samples {
+		labels := make(map[string]string)
+		for _, f := range decodeProtoFields(t, s.data) {
+			if f.num != 3 {
+				continue
+			}
+			var key, str uint64
+			for _, lf := range decodeProtoFields(t, f.data) {
+				if lf.num == 1 {
+					key = lf.value
+				} else if lf.num == 2 {
+					str = lf.value
+				}
+			}
+			if str != 0 {
+				labels[strs[key]] = strs[str]
+			}
+		}
+		result = append(result, labels)
+	}
+	return result
+}
+
+func TestProfilerLabelsAreAttachedToShardWork(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &cpuBoundSM{}
+		},
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.EnableProfilerLabels = true
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			var buf bytes.Buffer
+			if err := pprof.StartCPUProfile(&buf); err != nil {
+				t.Skipf("failed to start CPU profile, %v", err)
+			}
+			session := nh.GetNoOPSession(1)
+			for i := 0; i < 300; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+				_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
+				cancel()
+				if err != nil {
+					pprof.StopCPUProfile()
+					t.Fatalf("failed to make proposal, %v", err)
+				}
+			}
+			pprof.StopCPUProfile()
+			roles := make(map[string]struct{})
+			for _, labels := range getSampleLabels(t, buf.Bytes()) {
+				if labels[shardIDLabel] == "1" && labels[replicaIDLabel] == "1" {
+					roles[labels[roleLabel]] = struct{}{}
+				}
+			}
+			if _, ok := roles[applyWorkerRole]; !ok {
+				t.Errorf("shard labels not found in apply worker samples, %v", roles)
+			}
+			dump := getGoroutineDump(t)
+			for _, role := range []string{stepWorkerRole,
+				applyWorkerRole, snapshotWorkerRole, tickWorkerRole} {
+				if !strings.Contains(dump, `"role":"`+role+`"`) {
+					t.Errorf("goroutine with role %s not found", role)
+				}
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func getGoroutineDump(t *testing.T) string {
+	var dump bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&dump, 1); err != nil {
+		t.Fatalf("failed to get goroutine dump, %v", err)
+	}
+	return dump.String()
+}
+
+func TestWorkerLabelsAreRestoredAfterShardWork(t *testing.T) {
+	defer pprof.SetGoroutineLabels(context.Background())
+	n := &node{profilerLabels: getShardProfilerLabels(1234, 5678)}
+	shardLabels := `"replicaid":"5678", "role":"close", "shardid":"1234"`
+	for _, enabled := range []bool{false, true} {
+		labels := newWorkerLabels(enabled, closeWorkerRole, 9876)
+		var dump string
+		labels.do(n, func() { dump = getGoroutineDump(t) })
+		if strings.Contains(dump, shardLabels) != enabled {
+			t.Errorf("enabled %t, unexpected shard labels", enabled)
+		}
+		dump = getGoroutineDump(t)
+		if strings.Contains(dump, `"shardid":"1234"`) {
+			t.Errorf("enabled %t, shard labels not removed", enabled)
+		}
+		if strings.Contains(dump, `"role":"close", "workerid":"9876"`) != enabled {
+			t.Errorf("enabled %t, unexpected worker labels", enabled)
+		}
+	}
+}
@@ -16,6 +16,7 @@ package dragonboat
 
 import (
 	"sync"
+	"time"
 
 	"github.com/lni/dragonboat/v4/raftio"
 	pb "github.com/lni/dragonboat/v4/raftpb"
@@ -32,6 +33,14 @@ type entryQueue struct {
 	oldIdx        uint64
 	cycle         uint64
 	lazyFreeCycle uint64
+	// bytes is the total payload size of queued entries, since is the time the
+	// first of them was queued. They are used for holding back queued entries
+	// when proposal batching is enabled.
+	bytes         uint64
+	since         time.Time
+	batchDelay    time.Duration
+	batchMaxBytes uint64
+	batchMaxCount uint64
 	mu            sync.Mutex
 }
 
@@ -68,10 +77,41 @@ func (q *entryQueue) add(ent pb.Entry) (bool, bool) {
 	}
 	w := q.targetQueue()
 	w[q.idx] = ent
+	if q.idx == 0 && q.batchDelay > 0 {
+		q.since = time.Now()
+	}
 	q.idx++
+	q.bytes += uint64(len(ent.Cmd))
 	return true, false
 }
 
+// pendingSize returns the total in memory size of queued entries.
+func (q *entryQueue) pendingSize() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes + q.idx*entryInMemSize
+}
+
+// heldBack returns the remaining amount of time queued entries are held back
+// to be coalesced with entries queued later. 0 is returned when there is no
+// queued entry or when the queued entries should be taken right away.
+func (q *entryQueue) heldBack() time.Duration {
+	if q.batchDelay == 0 {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.idx == 0 || q.idx >= q.size ||
+		(q.batchMaxCount > 0 && q.idx >= q.batchMaxCount) ||
+		(q.batchMaxBytes > 0 && q.bytes >= q.batchMaxBytes) {
+		return 0
+	}
+	if wait := q.batchDelay - time.Since(q.since); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
 func (q *entryQueue) gc() {
 	if q.lazyFreeCycle > 0 {
 		oldq := q.targetQueue()
@@ -94,6 +134,7 @@ func (q *entryQueue) get(paused bool) []pb.Entry {
 	q.cycle++
 	sz := q.idx
 	q.idx = 0
+	q.bytes = 0
 	t := q.targetQueue()
 	q.leftInWrite = !q.leftInWrite
 	q.gc()
@@ -184,6 +225,12 @@ func (r *readyShard) setShardReady(shardID uint64) {
 	r.mu.Unlock()
 }
 
+func (r *readyShard) count() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return uint64(len(r.ready))
+}
+
 func (r *readyShard) getReadyShards() map[uint64]struct{} {
 	m := r.maps[(r.index+1)%2]
 	for k := range m {
@@ -200,18 +247,18 @@ func (r *readyShard) getReadyShards() map[uint64]struct{} {
 type leaderInfoQueue struct {
 	mu            sync.Mutex
 	notifications []raftio.LeaderInfo
-	workCh        chan struct{}
+	notifier      *eventNotifier
 }
 
 func newLeaderInfoQueue() *leaderInfoQueue {
 	return &leaderInfoQueue{
-		workCh:        make(chan struct{}, 1),
+		notifier:      newEventNotifier(false),
 		notifications: make([]raftio.LeaderInfo, 0),
 	}
 }
 
 func (li *leaderInfoQueue) workReady() chan struct{} {
-	return li.workCh
+	return li.notifier.workReady()
 }
 
 func (li *leaderInfoQueue) addLeaderInfo(info raftio.LeaderInfo) {
@@ -220,10 +267,7 @@ func (li *leaderInfoQueue) addLeaderInfo(info raftio.LeaderInfo) {
 		defer li.mu.Unlock()
 		li.notifications = append(li.notifications, info)
 	}()
-	select {
-	case li.workCh <- struct{}{}:
-	default:
-	}
+	li.notifier.notify()
 }
 
 func (li *leaderInfoQueue) getLeaderInfo() (raftio.LeaderInfo, bool) {
@@ -236,3 +280,41 @@ func (li *leaderInfoQueue) getLeaderInfo() (raftio.LeaderInfo, bool) {
 	}
 	return raftio.LeaderInfo{}, false
 }
+
+type membershipChangeQueue struct {
+	mu            sync.Mutex
+	notifications []raftio.MembershipChangeInfo
+	notifier      *eventNotifier
+}
+
+func newMembershipChangeQueue() *membershipChangeQueue {
+	return &membershipChangeQueue{
+		notifier:      newEventNotifier(false),
+		notifications: make([]raftio.MembershipChangeInfo, 0),
+	}
+}
+
+func (mq *membershipChangeQueue) workReady() chan struct{} {
+	return mq.notifier.workReady()
+}
+
+func (mq *membershipChangeQueue) addMembershipChange(
+	info raftio.MembershipChangeInfo) {
+	func() {
+		mq.mu.Lock()
+		defer mq.mu.Unlock()
+		mq.notifications = append(mq.notifications, info)
+	}()
+	mq.notifier.notify()
+}
+
+func (mq *membershipChangeQueue) getMembershipChange() (raftio.MembershipChangeInfo, bool) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	if len(mq.notifications) > 0 {
+		v := mq.notifications[0]
+		mq.notifications = mq.notifications[1:]
+		return v, true
+	}
+	return raftio.MembershipChangeInfo{}, false
+}
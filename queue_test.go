@@ -16,6 +16,7 @@ package dragonboat
 
 import (
 	"testing"
+	"time"
 
 	"github.com/lni/dragonboat/v4/raftio"
 	"github.com/lni/dragonboat/v4/raftpb"
@@ -218,6 +219,62 @@ func TestEntryQueueAllowAddedEntriesToBeReturned(t *testing.T) {
 	}
 }
 
+func TestEntryQueueEntriesAreNotHeldBackByDefault(t *testing.T) {
+	q := newEntryQueue(5, 0)
+	q.add(raftpb.Entry{Cmd: make([]byte, 16)})
+	if q.heldBack() != 0 {
+		t.Errorf("entries unexpectedly held back")
+	}
+}
+
+func TestEntryQueueEntriesAreHeldBackUntilBatchDelay(t *testing.T) {
+	q := newEntryQueue(5, 0)
+	q.batchDelay = time.Hour
+	if q.heldBack() != 0 {
+		t.Errorf("empty queue held back")
+	}
+	q.add(raftpb.Entry{Cmd: make([]byte, 16)})
+	if wait := q.heldBack(); wait <= 0 || wait > time.Hour {
+		t.Errorf("unexpected wait %v", wait)
+	}
+	q.since = time.Now().Add(-time.Hour)
+	if q.heldBack() != 0 {
+		t.Errorf("entries held back after batch delay")
+	}
+	q.get(false)
+	if q.bytes != 0 {
+		t.Errorf("bytes not reset")
+	}
+}
+
+func TestEntryQueueEntriesAreHeldBackUntilBatchIsFull(t *testing.T) {
+	tests := []struct {
+		maxBytes uint64
+		maxCount uint64
+		count    int
+	}{
+		{0, 0, 5},
+		{0, 3, 3},
+		{64, 0, 4},
+		{32, 3, 2},
+	}
+	for idx, tt := range tests {
+		q := newEntryQueue(5, 0)
+		q.batchDelay = time.Hour
+		q.batchMaxBytes = tt.maxBytes
+		q.batchMaxCount = tt.maxCount
+		for i := 0; i < tt.count; i++ {
+			if q.heldBack() == 0 && i > 0 {
+				t.Errorf("%d, entries not held back after %d entries", idx, i)
+			}
+			q.add(raftpb.Entry{Cmd: make([]byte, 16)})
+		}
+		if q.heldBack() != 0 {
+			t.Errorf("%d, full batch held back", idx)
+		}
+	}
+}
+
 func TestShardCanBeSetAsReady(t *testing.T) {
 	rc := newReadyShard()
 	if len(rc.ready) != 0 {
@@ -270,10 +327,10 @@ func TestReadyShardCanBeReturnedAndCleared(t *testing.T) {
 
 func TestLeaderInfoQueueCanBeCreated(t *testing.T) {
 	q := newLeaderInfoQueue()
-	if cap(q.workCh) != 1 {
+	if cap(q.workReady()) != 1 {
 		t.Errorf("unexpected queue cap")
 	}
-	if len(q.workCh) != 0 {
+	if len(q.workReady()) != 0 {
 		t.Errorf("unexpected queue length")
 	}
 	if len(q.notifications) != 0 {
@@ -289,7 +346,7 @@ func TestAddToLeaderInfoQueue(t *testing.T) {
 	q := newLeaderInfoQueue()
 	q.addLeaderInfo(raftio.LeaderInfo{})
 	q.addLeaderInfo(raftio.LeaderInfo{})
-	if len(q.workCh) != 1 {
+	if len(q.workReady()) != 1 {
 		t.Errorf("unexpected workCh len")
 	}
 	if len(q.notifications) != 2 {
@@ -15,21 +15,34 @@
 package dragonboat
 
 import (
+	"context"
+	"fmt"
 	"sync/atomic"
+	"time"
 
+	"github.com/lni/dragonboat/v4/internal/server"
 	pb "github.com/lni/dragonboat/v4/raftpb"
 )
 
+// minQuiesceIdleTicks is the minimum number of ticks without shard activity
+// required for manually entering quiesce mode, it allows responses to recent
+// replication messages to be received first.
+const minQuiesceIdleTicks uint64 = 2
+
 type quiesceState struct {
+	events              *sysEventListener
 	shardID             uint64
 	replicaID           uint64
 	currentTick         uint64
 	electionTick        uint64
+	idleThreshold       uint64
 	quiescedSince       uint64
 	idleSince           uint64
 	exitQuiesceTick     uint64
 	enabled             bool
+	forced              bool
 	newQuiesceStateFlag uint32
+	quiescedFlag        uint32
 }
 
 func (q *quiesceState) setNewQuiesceStateFlag() {
@@ -79,6 +92,9 @@ func (q *quiesceState) record(msgType pb.MessageType) {
 }
 
 func (q *quiesceState) threshold() uint64 {
+	if q.idleThreshold > 0 {
+		return q.idleThreshold
+	}
 	return q.electionTick * 10
 }
 
@@ -96,8 +112,11 @@ func (q *quiesceState) justExitedQuiesce() bool {
 	return q.currentTick-q.exitQuiesceTick < q.threshold()
 }
 
-func (q *quiesceState) tryEnterQuiesce() {
-	if q.justExitedQuiesce() {
+// tryEnterQuiesce enters quiesce mode when requested by a remote replica,
+// the request is ignored when quiesce mode was just exited unless the remote
+// replica was manually requested to quiesce.
+func (q *quiesceState) tryEnterQuiesce(forced bool) {
+	if !forced && q.justExitedQuiesce() {
 		return
 	}
 	if !q.quiesced() {
@@ -108,13 +127,209 @@ func (q *quiesceState) tryEnterQuiesce() {
 }
 
 func (q *quiesceState) enterQuiesce() {
+	idle := q.currentTick - q.idleSince
 	q.quiescedSince = q.currentTick
 	q.idleSince = q.currentTick
 	q.setNewQuiesceStateFlag()
+	atomic.StoreUint32(&q.quiescedFlag, 1)
 	plog.Infof("%s entered quiesce", dn(q.shardID, q.replicaID))
+	q.publish(server.QuiesceEntered, idle)
 }
 
 func (q *quiesceState) exitQuiesce() {
+	quiesced := q.currentTick - q.quiescedSince
 	q.quiescedSince = 0
 	q.exitQuiesceTick = q.currentTick
+	atomic.StoreUint32(&q.quiescedFlag, 0)
+	q.publish(server.QuiesceExited, quiesced)
+}
+
+// forceQuiesce enters quiesce mode as manually requested, remote replicas are
+// asked to enter quiesce mode regardless of their recent activities.
+func (q *quiesceState) forceQuiesce() {
+	if !q.quiesced() {
+		plog.Infof("%s going to enter quiesce as requested",
+			dn(q.shardID, q.replicaID))
+		q.enterQuiesce()
+		q.forced = true
+	}
+}
+
+// unquiesce exits quiesce mode as manually requested.
+func (q *quiesceState) unquiesce() {
+	if q.quiesced() {
+		q.idleSince = q.currentTick
+		q.exitQuiesce()
+		plog.Infof("%s exited from quiesce as requested, current tick %d",
+			dn(q.shardID, q.replicaID), q.currentTick)
+	}
+}
+
+// takeForced returns a boolean value indicating whether the most recent
+// transition into quiesce mode was manually requested.
+func (q *quiesceState) takeForced() bool {
+	forced := q.forced
+	q.forced = false
+	return forced
+}
+
+func (q *quiesceState) recentlyActive() bool {
+	return q.currentTick-q.idleSince < minQuiesceIdleTicks
+}
+
+// isQuiesced is the thread safe variant of quiesced.
+func (q *quiesceState) isQuiesced() bool {
+	return atomic.LoadUint32(&q.quiescedFlag) == 1
+}
+
+func (q *quiesceState) publish(t server.SystemEventType, ticks uint64) {
+	if q.events != nil {
+		q.events.Publish(server.SystemEvent{
+			Type:      t,
+			ShardID:   q.shardID,
+			ReplicaID: q.replicaID,
+			Ticks:     ticks,
+		})
+	}
+}
+
+// QuiesceRejectedError is the error returned when a replica can not enter
+// quiesce mode as requested. Reason explains why the replica is not idle.
+type QuiesceRejectedError struct {
+	Reason  string
+	ShardID uint64
+}
+
+func (e *QuiesceRejectedError) Error() string {
+	return fmt.Sprintf("shard %d can not quiesce: %s", e.ShardID, e.Reason)
+}
+
+type quiesceRequest struct {
+	resultC chan error
+	quiesce bool
+}
+
+// requestQuiesce asks the raft worker to enter or exit quiesce mode, the
+// result is delivered to the returned channel.
+func (n *node) requestQuiesce(quiesce bool) (chan error, error) {
+	if !n.initialized() {
+		return nil, ErrShardNotReady
+	}
+	if !n.qs.enabled {
+		return nil, &QuiesceRejectedError{
+			Reason:  "quiesce not enabled",
+			ShardID: n.shardID,
+		}
+	}
+	req := quiesceRequest{resultC: make(chan error, 1), quiesce: quiesce}
+	select {
+	case n.quiesceC <- req:
+		return req.resultC, nil
+	default:
+		return nil, ErrSystemBusy
+	}
+}
+
+func (n *node) handleQuiesceRequest() bool {
+	var req quiesceRequest
+	select {
+	case req = <-n.quiesceC:
+	default:
+		return false
+	}
+	if !req.quiesce {
+		n.qs.unquiesce()
+		req.resultC <- nil
+		return true
+	}
+	if reason := n.getQuiesceBlocker(); len(reason) > 0 {
+		req.resultC <- &QuiesceRejectedError{Reason: reason, ShardID: n.shardID}
+		return true
+	}
+	n.qs.forceQuiesce()
+	req.resultC <- nil
+	return true
+}
+
+// getQuiesceBlocker returns the reason why the replica is not idle, it
+// returns an empty string when the replica can enter quiesce mode.
+func (n *node) getQuiesceBlocker() string {
+	if requests, _ := n.listPendingRequests(1); len(requests) > 0 {
+		return "pending requests"
+	}
+	if n.qs.recentlyActive() {
+		return "recent activity"
+	}
+	if n.ss.saving() || n.ss.recovering() || n.ss.streaming() {
+		return "snapshot in progress"
+	}
+	status := n.p.GetStatus()
+	if status.LeaderID == pb.NoNode {
+		return "no leader"
+	}
+	if status.LeaderTransferTarget != pb.NoNode {
+		return "leader transfer in progress"
+	}
+	if status.PendingConfigChange {
+		return "config change in progress"
+	}
+	if status.Committed < status.LastIndex {
+		return "uncommitted entries"
+	}
+	if n.sm.GetLastApplied() < status.Committed {
+		return "unapplied entries"
+	}
+	for _, r := range status.Remotes {
+		if r.Match < status.LastIndex {
+			return fmt.Sprintf("replica %d not caught up", r.ReplicaID)
+		}
+	}
+	return ""
+}
+
+// Quiesce requests the local replica of the specified shard to enter quiesce
+// mode and asks other replicas to do the same. Quiesce must be enabled in the
+// config.Config of the shard. A *QuiesceRejectedError is returned when the
+// replica is not idle, e.g. when there are pending requests, uncommitted or
+// unapplied entries, or when the replica is the leader and some replicas have
+// not caught up with its log. The shard transparently exits quiesce mode on
+// its next activity, such as a proposal.
+func (nh *NodeHost) Quiesce(shardID uint64) (err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "Quiesce",
+		ShardID:   shardID,
+	}, time.Now(), &err)
+	return nh.requestQuiesce(shardID, true)
+}
+
+// Unquiesce requests the local replica of the specified shard to exit quiesce
+// mode. Other replicas exit quiesce mode once they hear from the local
+// replica. It is a no-op when the replica is not in quiesce mode.
+func (nh *NodeHost) Unquiesce(shardID uint64) (err error) {
+	defer nh.audit(context.Background(), AuditEntry{
+		Operation: "Unquiesce",
+		ShardID:   shardID,
+	}, time.Now(), &err)
+	return nh.requestQuiesce(shardID, false)
+}
+
+func (nh *NodeHost) requestQuiesce(shardID uint64, quiesce bool) error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nh.shardNotFound(shardID)
+	}
+	resultC, err := n.requestQuiesce(quiesce)
+	if err != nil {
+		return err
+	}
+	nh.engine.setStepReady(shardID)
+	select {
+	case err := <-resultC:
+		return err
+	case <-n.stopC:
+		return ErrShardClosed
+	}
 }
@@ -15,9 +15,20 @@
 package dragonboat
 
 import (
+	"context"
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/tests"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/clocktest"
 	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
 )
 
 func getTestQuiesce() quiesceState {
@@ -149,3 +160,236 @@ func TestWillNotExitFromQuiesceForDelayedMsgHeartbeatMsg(t *testing.T) {
 		t.Errorf("got %t, want false", q.quiesced())
 	}
 }
+
+func TestQuiesceThresholdCanBeOverridden(t *testing.T) {
+	q := getTestQuiesce()
+	q.idleThreshold = 30
+	for k := uint64(0); k < 30; k++ {
+		q.tick()
+	}
+	if q.quiesced() {
+		t.Fatalf("unexpectedly quiesced")
+	}
+	q.tick()
+	if !q.quiesced() {
+		t.Errorf("failed to enter quiesce")
+	}
+}
+
+func TestForcedQuiesceIgnoresRecentExit(t *testing.T) {
+	q := getTestQuiesce()
+	for k := uint64(0); k < q.threshold()+1; k++ {
+		q.tick()
+	}
+	q.record(pb.Replicate)
+	if q.quiesced() || !q.justExitedQuiesce() {
+		t.Fatalf("unexpected quiesce state")
+	}
+	q.tryEnterQuiesce(false)
+	if q.quiesced() {
+		t.Fatalf("quiesce message not ignored")
+	}
+	q.tryEnterQuiesce(true)
+	if !q.quiesced() {
+		t.Errorf("forced quiesce message ignored")
+	}
+}
+
+func TestQuiesceCanBeManuallyControlled(t *testing.T) {
+	q := getTestQuiesce()
+	q.tick()
+	q.forceQuiesce()
+	if !q.quiesced() || !q.isQuiesced() || !q.newQuiesceState() {
+		t.Fatalf("failed to enter quiesce")
+	}
+	if !q.takeForced() || q.takeForced() {
+		t.Errorf("unexpected forced flag")
+	}
+	q.tick()
+	q.unquiesce()
+	if q.quiesced() || q.isQuiesced() {
+		t.Fatalf("failed to exit quiesce")
+	}
+	if q.idleSince != q.currentTick {
+		t.Errorf("idleSince %d, want %d", q.idleSince, q.currentTick)
+	}
+}
+
+func TestQuiesceEventsArePublished(t *testing.T) {
+	q := getTestQuiesce()
+	q.shardID = 1
+	q.replicaID = 2
+	q.events = newSysEventListener(&testSysEventListener{}, 0)
+	threshold := q.threshold()
+	for k := uint64(0); k < threshold+1; k++ {
+		q.tick()
+	}
+	for k := uint64(0); k < 5; k++ {
+		q.tick()
+	}
+	q.record(pb.Replicate)
+	tests := []struct {
+		et    server.SystemEventType
+		ticks uint64
+	}{
+		{server.QuiesceEntered, threshold + 1},
+		{server.QuiesceExited, 5},
+	}
+	for idx, tt := range tests {
+		e, ok := q.events.getEvent()
+		if !ok || e.Type != tt.et || e.Ticks != tt.ticks ||
+			e.ShardID != 1 || e.ReplicaID != 2 {
+			t.Errorf("%d, unexpected event %+v", idx, e)
+		}
+	}
+	if _, ok := q.events.getEvent(); ok {
+		t.Errorf("unexpected event")
+	}
+}
+
+func TestQuiesceIsRejectedWhenNotEnabled(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			var qe *QuiesceRejectedError
+			if err := nh.Quiesce(1); !errors.As(err, &qe) || qe.ShardID != 1 {
+				t.Errorf("unexpected error %v", err)
+			}
+			if err := nh.Quiesce(2); err != ErrShardNotFound {
+				t.Errorf("unexpected error %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestShardCanBeManuallyQuiesced(t *testing.T) {
+	fs := vfs.GetTestFS()
+	// all NodeHosts are ticked by the same manually advanced clock so exactly
+	// the specified number of ticks happen in quiesce mode
+	clock := clocktest.NewClock(time.Now())
+	tf := func() {
+		nhs := make(map[uint64]*NodeHost)
+		defer func() {
+			for _, nh := range nhs {
+				nh.Close()
+			}
+		}()
+		peers := getThreeReplicaTestPeers()
+		for replicaID := uint64(1); replicaID <= 3; replicaID++ {
+			dir := fs.PathJoin(singleNodeHostTestDir, fmt.Sprintf("nh%d", replicaID))
+			nhc := config.NodeHostConfig{
+				NodeHostDir:    dir,
+				RTTMillisecond: getRTTMillisecond(fs, dir),
+				RaftAddress:    peers[replicaID],
+				Expert:         getTestExpertConfig(fs),
+			}
+			nhc.Expert.Clock = clock
+			nh, err := NewNodeHost(nhc)
+			if err != nil {
+				t.Fatalf("failed to create node host %v", err)
+			}
+			nhs[replicaID] = nh
+			rc := config.Config{
+				ShardID:          1,
+				ReplicaID:        replicaID,
+				ElectionRTT:      10,
+				HeartbeatRTT:     1,
+				Quiesce:          true,
+				QuiesceThreshold: 100000,
+			}
+			newSM := func(uint64, uint64) sm.IStateMachine {
+				return &tests.NoOP{}
+			}
+			if err := nh.StartReplica(peers, false, newSM, rc); err != nil {
+				t.Fatalf("failed to start shard %v", err)
+			}
+		}
+		advanceUntilLeaderElected(t, nhs[1], clock, 1)
+		leaderID, _, _, err := nhs[1].GetLeaderID(1)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		leader := nhs[leaderID]
+		advanceUntil(t, leader, clock, func() bool {
+			id, _, ok, err := leader.GetLeaderID(1)
+			return err == nil && ok && id == leaderID
+		})
+		rtt := time.Duration(leader.NodeHostConfig().RTTMillisecond) *
+			time.Millisecond
+		propose := func() {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(leader))
+			defer cancel()
+			session := leader.GetNoOPSession(1)
+			if _, err := leader.SyncPropose(ctx, session, []byte("test")); err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+		}
+		quiesced := func(want bool) bool {
+			for _, nh := range nhs {
+				info := nh.GetNodeHostInfo(DefaultNodeHostInfoOption)
+				if len(info.ShardInfoList) != 1 ||
+					info.ShardInfoList[0].Quiesced != want {
+					return false
+				}
+			}
+			return true
+		}
+		waitForQuiesced := func(want bool) {
+			advanceUntil(t, leader, clock, func() bool { return quiesced(want) })
+		}
+		heartbeats := func() uint64 {
+			stats, err := leader.GetElectionStats(1)
+			if err != nil {
+				t.Fatalf("failed to get election stats %v", err)
+			}
+			count := uint64(0)
+			for _, p := range stats.Peers {
+				count += p.Samples
+			}
+			return count
+		}
+		waitForHeartbeats := func(count uint64) {
+			advanceUntil(t, leader, clock, func() bool { return heartbeats() > count })
+		}
+		quiesce := func() {
+			advanceUntil(t, leader, clock, func() bool {
+				err := leader.Quiesce(1)
+				var qe *QuiesceRejectedError
+				if err != nil && !errors.As(err, &qe) {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return err == nil
+			})
+		}
+		propose()
+		quiesce()
+		waitForQuiesced(true)
+		// heartbeats in flight when entering quiesce are allowed to complete,
+		// no tick happens in the meantime
+		time.Sleep(5 * rtt)
+		count := heartbeats()
+		clock.Advance(30 * rtt)
+		time.Sleep(5 * rtt)
+		if v := heartbeats(); v != count {
+			t.Errorf("heartbeats sent in quiesce mode, %d/%d", v, count)
+		}
+		// the next proposal transparently exits quiesce mode
+		propose()
+		waitForQuiesced(false)
+		waitForHeartbeats(count)
+		quiesce()
+		waitForQuiesced(true)
+		if err := leader.Unquiesce(1); err != nil {
+			t.Fatalf("failed to unquiesce %v", err)
+		}
+		waitForQuiesced(false)
+		waitForHeartbeats(heartbeats())
+		if newLeaderID, _, _, err := leader.GetLeaderID(1); err != nil ||
+			newLeaderID != leaderID {
+			t.Errorf("leader changed to %d, %v", newLeaderID, err)
+		}
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
@@ -0,0 +1,43 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftio
+
+import (
+	"time"
+)
+
+// AuditEntry is the record of an administrative operation, such as membership
+// change, snapshot request, compaction, leader transfer and data removal,
+// executed through a NodeHost instance.
+type AuditEntry struct {
+	// Time is the time when the operation was invoked.
+	Time time.Time
+	// Error is the error returned by the operation, it is nil when the
+	// operation completed successfully.
+	Error error
+	// Parameters contains the parameters of the operation other than the shard
+	// ID and the replica ID.
+	Parameters map[string]interface{}
+	// Operation is the name of the invoked NodeHost method.
+	Operation string
+	// CallerTag is the opaque tag attached to the context of the operation by
+	// the caller, it is empty when no tag is attached or when the operation
+	// doesn't accept a context.
+	CallerTag string
+	ShardID   uint64
+	ReplicaID uint64
+	// Duration is the amount of time spent in the operation.
+	Duration time.Duration
+}
@@ -14,6 +14,12 @@
 
 package raftio
 
+import (
+	"time"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
 const (
 	// NoLeader is a special leader ID value to indicate that there is currently
 	// no leader or leader ID is unknown.
@@ -49,12 +55,343 @@ type SnapshotInfo struct {
 	Index     uint64
 }
 
+// SnapshotProgressInfo contains info of the snapshot being received.
+type SnapshotProgressInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	From      uint64
+	Index     uint64
+	// ReceivedBytes is the number of snapshot bytes received so far.
+	ReceivedBytes uint64
+	// TotalBytes is the total size of the snapshot files known so far. It is 0
+	// when the snapshot is streamed from the state machine and its size is not
+	// known in advance.
+	TotalBytes uint64
+}
+
+// SnapshotAbortInfo contains info of the snapshot that failed to be received.
+type SnapshotAbortInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	From      uint64
+	Index     uint64
+	// Reason describes why the snapshot is not received.
+	Reason string
+}
+
 // ConnectionInfo contains info of the connection.
 type ConnectionInfo struct {
 	Address            string
 	SnapshotConnection bool
 }
 
+// MisdeliveredMessageInfo contains info of messages reported by the remote
+// NodeHost as targeting a replica unknown to it.
+type MisdeliveredMessageInfo struct {
+	// Address is the address of the remote NodeHost.
+	Address   string
+	ShardID   uint64
+	ReplicaID uint64
+}
+
+// StagedPromotionInfo contains info of the staged non-voting member that
+// failed to be promoted to a regular node in time.
+type StagedPromotionInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// Match is the index of the last Raft log entry known to be replicated to
+	// the staged non-voting member.
+	Match uint64
+}
+
+// NonVotingLagInfo contains info of the non-voting member that is lagging
+// behind the leader.
+type NonVotingLagInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// Match is the index of the last Raft log entry known to be replicated to
+	// the non-voting member.
+	Match uint64
+	// Lag is the number of Raft log entries the non-voting member is behind the
+	// last index of the leader.
+	Lag uint64
+}
+
+// BootstrapMismatchInfo contains info of the remote replica bootstrapped with
+// initial members different from the ones used by the local replica, or with
+// timings incompatible with the ones used by the local replica.
+type BootstrapMismatchInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// From is the ReplicaID of the remote replica.
+	From uint64
+	// LocalHash is the hash of the initial members of the local replica.
+	LocalHash uint64
+	// RemoteHash is the hash of the initial members of the remote replica.
+	RemoteHash uint64
+	// LocalElectionTimeout is the election timeout of the local replica, it is
+	// set along with RemoteHeartbeatInterval when the mismatch is caused by the
+	// remote heartbeat interval not being short enough for the local election
+	// timeout. Both hash fields are 0 in such case.
+	LocalElectionTimeout time.Duration
+	// RemoteHeartbeatInterval is the heartbeat interval of the remote replica.
+	RemoteHeartbeatInterval time.Duration
+}
+
+// SlowStateMachineInfo contains info of a slow invocation of the user state
+// machine.
+type SlowStateMachineInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// Callback is the name of the slow state machine method, it is one of
+	// Update, Lookup and SaveSnapshot.
+	Callback string
+	// Index is the last applied index of the state machine when the slow
+	// invocation completed.
+	Index uint64
+	// RequestID is the ID of the client request that proposed the entry at
+	// Index, it is only available for slow Update invocations when
+	// config.Config.PropagateRequestIDs is enabled.
+	RequestID []byte
+	// Duration is the amount of time spent in the invocation.
+	Duration time.Duration
+}
+
+// SlowDiskInfo contains info of a slow save of Raft state to the LogDB.
+type SlowDiskInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// Duration is the amount of time spent in saving the Raft state batch that
+	// includes the replica.
+	Duration time.Duration
+}
+
+// ApplyStallInfo contains info of a replica whose state machine stopped
+// applying committed entries.
+type ApplyStallInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// Index is the last applied index of the state machine.
+	Index uint64
+	// Lag is the number of committed entries not applied yet.
+	Lag uint64
+	// Duration is the amount of time since the applied index last advanced.
+	Duration time.Duration
+}
+
+// DiskSpaceInfo contains info of a monitored directory with its free disk
+// space crossing the thresholds specified in config.DiskMonitorConfig.
+type DiskSpaceInfo struct {
+	// Path is the monitored directory.
+	Path string
+	// ShardID is the ID of the shard of the on disk state machine storing its
+	// data in Path, it is 0 when Path is the NodeHostDir or the WALDir.
+	ShardID uint64
+	// AvailBytes is the number of bytes available to the NodeHost process.
+	AvailBytes uint64
+	// TotalBytes is the size of the disk in bytes.
+	TotalBytes uint64
+}
+
+// QuiesceInfo contains info of a replica entering or exiting quiesce mode.
+type QuiesceInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// Ticks is the number of ticks the replica had been idle before entering
+	// quiesce mode, or the number of ticks it had been quiesced before exiting
+	// quiesce mode.
+	Ticks uint64
+}
+
+// GossipInfo contains info of the gossip service of the local NodeHost.
+type GossipInfo struct {
+	// AdvertiseAddress is the address of the local gossip service.
+	AdvertiseAddress string
+	// Members is the number of live members of the gossip group known to the
+	// local gossip service.
+	Members uint64
+}
+
+// NodeHostLivenessInfo contains info of a NodeHost instance suspected as failed
+// or recovered from such failure.
+type NodeHostLivenessInfo struct {
+	NodeHostID  string
+	RaftAddress string
+}
+
+// OrphanPurgeInfo contains info of orphaned data purged by
+// NodeHost.PurgeOrphanedData.
+type OrphanPurgeInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// Path is the purged snapshot directory, it is empty when the replica has
+	// no snapshot directory.
+	Path string
+	// Bytes is the size of the purged snapshot directory.
+	Bytes uint64
+	// Completed is the number of orphans purged so far, including this one,
+	// out of the Total number of orphans requested to be purged.
+	Completed uint64
+	Total     uint64
+}
+
+// StartupAuditInfo contains info of inconsistencies found in the persisted
+// state of a replica when it is restarted, see
+// config.NodeHostConfig.AuditOnStart for details.
+type StartupAuditInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// Violations is the number of inconsistencies found, Repaired is the
+	// number of those repaired.
+	Violations uint64
+	Repaired   uint64
+	// Report describes all found inconsistencies.
+	Report string
+}
+
+// CampaignSuppressedInfo contains info of a campaign suppressed as the
+// NodeHost is in the read-only mode, see config.NodeHostConfig.ReadOnlyMode
+// for details.
+type CampaignSuppressedInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// Term is the term of the replica when the campaign was suppressed.
+	Term uint64
+}
+
+// LeaderDegradedInfo contains info of a leader considered as degraded as its
+// local latency kept exceeding config.Config.DegradedLeaderThreshold.
+type LeaderDegradedInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// Operation is the slow operation, it is either "Update" for the Update
+	// method of the state machine or "LogDB" for saving Raft state to the
+	// LogDB.
+	Operation string
+	// Latency is the latency of the slowest such operation observed in the
+	// last RTT.
+	Latency time.Duration
+	// Ticks is the number of consecutive ticks the latency exceeded the
+	// threshold.
+	Ticks uint64
+	// Target is the ReplicaID of the replica the leadership is being
+	// transferred to, it is 0 when there is no healthy and caught up replica.
+	Target uint64
+}
+
+// NodeRemovedInfo contains info of a replica that learned that it has been
+// removed from its shard.
+type NodeRemovedInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// Index is the index of the config change entry that removed the replica.
+	// It is the config change index recorded in the snapshot when the removal
+	// is learned by recovering from a snapshot.
+	Index uint64
+}
+
+// EnginePanicInfo contains info of a panic recovered from an engine worker
+// goroutine, it describes the operation being performed by the worker when
+// the panic occurred.
+type EnginePanicInfo struct {
+	// ShardID and ReplicaID identify the replica being handled by the worker,
+	// they are 0 when the operation involves multiple replicas.
+	ShardID   uint64
+	ReplicaID uint64
+	// Operation is the name of the operation being performed, e.g. "apply".
+	Operation string
+	// FirstIndex and LastIndex are the index range of the Raft log entries
+	// being handled by the operation, they are 0 when not applicable.
+	FirstIndex uint64
+	LastIndex  uint64
+	// Panic is the value passed to panic in its string form.
+	Panic string
+}
+
+// LogRetentionInfo contains info of a replica retaining more Raft log entries
+// than expected, see config.Config.LogRetentionAlertFactor for details.
+type LogRetentionInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// FirstIndex and LastIndex are the first and last indexes of the retained
+	// Raft log.
+	FirstIndex uint64
+	LastIndex  uint64
+	// SnapshotIndex is the index of the last snapshot of the replica.
+	SnapshotIndex uint64
+	// Reason is the name of the reason why the log has not been compacted, see
+	// dragonboat.CompactionBlockReason for possible values.
+	Reason string
+}
+
+// SnapshotFingerprintInfo contains info of a replica recovered from a received
+// snapshot with a state machine fingerprint different from the one recorded in
+// the snapshot.
+type SnapshotFingerprintInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// Index is the index of the snapshot.
+	Index uint64
+	// Recorded is the fingerprint recorded by the replica that created the
+	// snapshot.
+	Recorded uint64
+	// Computed is the fingerprint computed by the local replica after it
+	// recovered from the snapshot.
+	Computed uint64
+}
+
+// ListenerPanicInfo contains info of a panic recovered from a user event
+// listener callback.
+type ListenerPanicInfo struct {
+	// Listener is the name of the listener interface, e.g.
+	// "ISystemEventListener".
+	Listener string
+	// Panic is the value passed to panic in its string form.
+	Panic string
+	// ShardID and ReplicaID identify the replica of the event being delivered
+	// when the panic occurred, they are 0 for events not related to any replica.
+	ShardID   uint64
+	ReplicaID uint64
+}
+
+// MembershipChangeInfo contains info of the membership change applied by a
+// replica.
+type MembershipChangeInfo struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// Index is the index of the applied config change entry.
+	Index uint64
+	// Type is the type of the applied config change.
+	Type pb.ConfigChangeType
+	// ChangedReplicaID is the ReplicaID of the replica affected by the config
+	// change. It is 0 for config changes entering or leaving a joint
+	// configuration.
+	ChangedReplicaID uint64
+	// Address is the target of the affected replica as specified in the config
+	// change, it is empty for removed replicas.
+	Address string
+	// Nodes, NonVotings, Witnesses, Outgoing and Removed are the resulting
+	// membership of the shard after the config change is applied.
+	Nodes      map[uint64]string
+	NonVotings map[uint64]string
+	Witnesses  map[uint64]string
+	Outgoing   map[uint64]string
+	Removed    map[uint64]struct{}
+	// Replayed indicates that the config change entry had already been
+	// committed before the replica was restarted, the membership change is
+	// applied again when replaying the Raft log.
+	Replayed bool
+}
+
+// IMembershipListener is the listener for membership changes applied by
+// replicas managed by the NodeHost.
+type IMembershipListener interface {
+	// MembershipChanged is invoked after the config change entry is applied by
+	// the replica. Membership changes of each replica are reported in the same
+	// order as they are applied, rejected config changes are not reported.
+	MembershipChanged(info MembershipChangeInfo)
+}
+
 // ISystemEventListener is the system event listener used by the NodeHost.
 type ISystemEventListener interface {
 	NodeHostShuttingDown()
@@ -64,13 +401,105 @@ type ISystemEventListener interface {
 	MembershipChanged(info NodeInfo)
 	ConnectionEstablished(info ConnectionInfo)
 	ConnectionFailed(info ConnectionInfo)
+	ConnectionRejected(info ConnectionInfo)
+	MisdeliveredMessage(info MisdeliveredMessageInfo)
 	SendSnapshotStarted(info SnapshotInfo)
 	SendSnapshotCompleted(info SnapshotInfo)
 	SendSnapshotAborted(info SnapshotInfo)
+	SnapshotReceiveStarted(info SnapshotInfo)
+	SnapshotReceiveProgress(info SnapshotProgressInfo)
+	SnapshotReceiveAborted(info SnapshotAbortInfo)
 	SnapshotReceived(info SnapshotInfo)
 	SnapshotRecovered(info SnapshotInfo)
 	SnapshotCreated(info SnapshotInfo)
 	SnapshotCompacted(info SnapshotInfo)
 	LogCompacted(info EntryInfo)
 	LogDBCompacted(info EntryInfo)
+	StagedPromotionTimeout(info StagedPromotionInfo)
+	NonVotingLagging(info NonVotingLagInfo)
+	NonVotingLagRecovered(info NonVotingLagInfo)
+	BootstrapMismatch(info BootstrapMismatchInfo)
+	SlowStateMachine(info SlowStateMachineInfo)
+	SlowDisk(info SlowDiskInfo)
+	ApplyStalled(info ApplyStallInfo)
+	ApplyStallCleared(info ApplyStallInfo)
+	// DiskSpaceLow, DiskSpaceCritical and DiskSpaceRecovered are invoked when
+	// the free space of a monitored directory changes to be below the warning
+	// threshold, below the critical threshold and above both thresholds
+	// respectively. See config.DiskMonitorConfig for details.
+	DiskSpaceLow(info DiskSpaceInfo)
+	DiskSpaceCritical(info DiskSpaceInfo)
+	DiskSpaceRecovered(info DiskSpaceInfo)
+	// QuiesceEntered and QuiesceExited are invoked when the replica enters and
+	// exits quiesce mode respectively.
+	QuiesceEntered(info QuiesceInfo)
+	QuiesceExited(info QuiesceInfo)
+	// LogRetentionExceeded is invoked when the replica retains more Raft log
+	// entries than expected, see config.Config.LogRetentionAlertFactor for
+	// details.
+	LogRetentionExceeded(info LogRetentionInfo)
+	// SnapshotFingerprintMismatch is invoked when the fingerprint of the state
+	// machine recovered from a received snapshot differs from the fingerprint
+	// recorded in the snapshot, it indicates divergent or corrupted state
+	// machines. See statemachine.IFingerprint for details.
+	SnapshotFingerprintMismatch(info SnapshotFingerprintInfo)
+	// GossipIsolated is invoked when the local gossip service becomes the only
+	// live member of the gossip group, e.g. when it fails to join the gossip
+	// group or all other members are lost. GossipRejoined is invoked when the
+	// local gossip service rejoins the gossip group afterwards.
+	GossipIsolated(info GossipInfo)
+	GossipRejoined(info GossipInfo)
+	// NodeHostSuspected is invoked when a remote NodeHost instance has been
+	// suspected as failed by the gossip service for longer than the
+	// GossipConfig.SuspectGracePeriod, messages to replicas running on it are
+	// dropped without dialing it. NodeHostRecovered is invoked when such
+	// NodeHost instance is observed as alive again.
+	NodeHostSuspected(info NodeHostLivenessInfo)
+	NodeHostRecovered(info NodeHostLivenessInfo)
+	// OrphanedDataPurged is invoked each time orphaned data of a replica has
+	// been purged by NodeHost.PurgeOrphanedData.
+	OrphanedDataPurged(info OrphanPurgeInfo)
+	// StartupAuditFailed is invoked when inconsistencies are found in the
+	// persisted state of a replica being restarted, see
+	// config.NodeHostConfig.AuditOnStart for details.
+	StartupAuditFailed(info StartupAuditInfo)
+	// CampaignSuppressed is invoked when a voting replica on a NodeHost in the
+	// read-only mode is prevented from campaigning to become the leader. It is
+	// invoked at most once per term for each replica.
+	CampaignSuppressed(info CampaignSuppressedInfo)
+	// LeaderDegraded is invoked when the local latency of a leader keeps
+	// exceeding the threshold, see config.Config.DegradedLeaderThreshold for
+	// details.
+	LeaderDegraded(info LeaderDegradedInfo)
+	// NodeRemovedFromShard is invoked when a replica learns that it has been
+	// removed from its shard, either by applying the config change entry or by
+	// recovering from a snapshot. The replica is unloaded and reported with
+	// the IsRemoved flag set in its ShardInfo, requests targeting it fail with
+	// dragonboat.ErrReplicaRemoved until it is stopped using
+	// NodeHost.StopReplica, its data can then be removed using
+	// NodeHost.RemoveData. NodeDeleted is invoked right before
+	// NodeRemovedFromShard.
+	NodeRemovedFromShard(info NodeRemovedInfo)
+	// EnginePanicked is invoked when a panic is recovered from an engine worker
+	// goroutine, the panic is re-raised with its value wrapped in a
+	// dragonboat.EnginePanic once EnginePanicked returns. It is invoked from
+	// the panicking goroutine, possibly concurrently with other callbacks, as
+	// the process is about to crash.
+	EnginePanicked(info EnginePanicInfo)
+	// ListenerPanicked is invoked after a panic is recovered from a callback of
+	// the ISystemEventListener, IRaftEventListener or IMembershipListener.
+	// Panics from the ListenerPanicked method itself are logged only.
+	ListenerPanicked(info ListenerPanicInfo)
+}
+
+// IEventQueueStats provides statistics of the bounded queue used by NodeHost
+// to deliver system events to the ISystemEventListener. Events are delivered
+// in the order in which they are published, the oldest queued event is
+// dropped when the queue is full.
+type IEventQueueStats interface {
+	// Dropped returns the total number of events dropped as the
+	// ISystemEventListener couldn't keep up.
+	Dropped() uint64
+	// Pending returns the number of queued events not yet delivered.
+	Pending() uint64
 }
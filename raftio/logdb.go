@@ -25,6 +25,9 @@ var (
 	ErrNoSavedLog = errors.New("no saved log")
 	// ErrNoBootstrapInfo indicates that there is no saved bootstrap info.
 	ErrNoBootstrapInfo = errors.New("no bootstrap info")
+	// ErrCorruptedRecord indicates that a record read from LogDB is malformed,
+	// it is usually caused by disk corruption.
+	ErrCorruptedRecord = errors.New("corrupted LogDB record")
 )
 
 // Metrics is the metrics of the LogDB.
@@ -36,3 +36,66 @@ type INodeRegistry interface {
 	RemoveShard(shardID uint64)
 	Resolve(shardID uint64, replicaID uint64) (string, string, error)
 }
+
+// NodeHostInfo is the information of a NodeHost instance known to an
+// IRegistry instance.
+type NodeHostInfo struct {
+	// NodeHostID is the NodeHostID of the NodeHost instance.
+	NodeHostID string
+	// RaftAddress is the current RaftAddress of the NodeHost instance.
+	RaftAddress string
+	// Meta is the optional metadata published by the NodeHost instance.
+	Meta []byte
+	// Tags are the optional application defined tags of the NodeHost instance,
+	// e.g. its zone or rack.
+	Tags map[string]string
+	// Draining indicates that the NodeHost instance is being drained, no new
+	// replica should be placed on it and its leaderships should be moved away.
+	Draining bool
+}
+
+// ShardView is the view of a Raft shard published by NodeHost instances
+// managing its replicas.
+type ShardView struct {
+	ShardID           uint64
+	Replicas          map[uint64]string
+	NonVotings        map[uint64]string
+	Witnesses         map[uint64]string
+	ConfigChangeIndex uint64
+	LeaderID          uint64
+	Term              uint64
+}
+
+// IRegistry is the interface used by NodeHost for discovering other NodeHost
+// instances when NodeHost instances are addressed by their NodeHostID values,
+// i.e. when the NodeHostConfig.DefaultNodeRegistryEnabled field is set. The
+// built-in gossip service implements IRegistry, custom implementations backed
+// by external services such as etcd or consul can be provided by setting the
+// NodeHostConfig.Expert.RegistryFactory field.
+//
+// An IRegistry instance is expected to publish the NodeHostInfo of the local
+// NodeHost instance, including its metadata, once created. Implementations
+// must be safe for concurrent use, GetNodeHost in particular is invoked each
+// time a connection to a remote NodeHost is established.
+type IRegistry interface {
+	// GetNodeHost returns the NodeHostInfo of the specified NodeHost instance.
+	// The boolean value is false when the NodeHost instance is unknown or its
+	// record has expired.
+	GetNodeHost(nhid string) (NodeHostInfo, bool)
+	// NodeHosts returns the NodeHostInfo of all known NodeHost instances,
+	// including the local one.
+	NodeHosts() []NodeHostInfo
+	// Publish publishes the views of shards managed by the local NodeHost
+	// instance. It is periodically invoked by NodeHost, implementations can use
+	// it to refresh the record of the local NodeHost instance and their local
+	// knowledge of other NodeHost instances.
+	Publish(shards []ShardView) error
+	// GetShardView returns the most recent view of the specified shard based on
+	// views published by all known NodeHost instances.
+	GetShardView(shardID uint64) (ShardView, bool)
+	// NumOfShards returns the number of shards known to the registry.
+	NumOfShards() int
+	// Close closes the registry and withdraws the record of the local NodeHost
+	// instance when possible.
+	Close() error
+}
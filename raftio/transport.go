@@ -29,6 +29,7 @@ package raftio
 
 import (
 	"context"
+	"io"
 
 	pb "github.com/lni/dragonboat/v4/raftpb"
 )
@@ -94,3 +95,47 @@ type ITransport interface {
 	GetSnapshotConnection(ctx context.Context,
 		target string) (ISnapshotConnection, error)
 }
+
+// SnapshotMeta contains details of a snapshot about to be sent to a remote
+// NodeHost instance.
+type SnapshotMeta struct {
+	// ShardID is the shard ID of the snapshot.
+	ShardID uint64
+	// ReplicaID is the replica ID of the node that will receive the snapshot.
+	ReplicaID uint64
+	// From is the replica ID of the node that is sending the snapshot.
+	From uint64
+	// Index is the index of the snapshot.
+	Index uint64
+	// Term is the term of the snapshot.
+	Term uint64
+	// Filepath is the local path of the snapshot file.
+	Filepath string
+	// FileSize is the size of the snapshot file in bytes.
+	FileSize uint64
+}
+
+// SnapshotWriter is the writer used for writing the content of a sideloaded
+// snapshot file into the local snapshot directory.
+type SnapshotWriter interface {
+	io.Writer
+}
+
+// ISnapshotSideloader is the interface used for transferring snapshot files
+// out-of-band, e.g. via a shared object storage, instead of streaming them to
+// the remote NodeHost over the transport module.
+//
+// On the sending side, Offer is invoked before streaming the snapshot, when
+// it returns true, only the returned locator is sent to the remote NodeHost.
+// On the receiving side, Fetch is invoked to write the content of the
+// snapshot identified by the locator into dst. Fetched snapshots are checked
+// using their checksums. When Fetch fails, the snapshot is rejected and
+// normal chunk streaming is used when the same snapshot is sent again.
+type ISnapshotSideloader interface {
+	// Offer returns the locator of the specified snapshot and a boolean flag
+	// indicating whether the snapshot is available for sideloading.
+	Offer(meta SnapshotMeta) (locator string, ok bool)
+	// Fetch writes the content of the snapshot identified by the locator into
+	// dst.
+	Fetch(ctx context.Context, locator string, dst SnapshotWriter) error
+}
@@ -9,9 +9,19 @@ import (
 )
 
 type Bootstrap struct {
-	Addresses map[uint64]string
-	Join      bool
-	Type      StateMachineType
+	Addresses           map[uint64]string
+	Join                bool
+	Type                StateMachineType
+	Promoted            bool
+	UnsafeRecoveries    uint64
+	UnsafeRecoveryIndex uint64
+	UnsafeRecoveryTime  int64
+	Standby             bool
+	WriteFsyncMode      uint32
+	Volatile            bool
+	Frozen              bool
+	WitnessIndex        uint64
+	WitnessTerm         uint64
 }
 
 func (m *Bootstrap) Marshal() (dAtA []byte, err error) {
@@ -56,6 +66,54 @@ func (m *Bootstrap) MarshalTo(dAtA []byte) (int, error) {
 	dAtA[i] = 0x18
 	i++
 	i = encodeVarintRaft(dAtA, i, uint64(m.Type))
+	if m.Promoted {
+		dAtA[i] = 0x20
+		i++
+		dAtA[i] = 1
+		i++
+	}
+	if m.UnsafeRecoveries > 0 {
+		dAtA[i] = 0x28
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(m.UnsafeRecoveries))
+		dAtA[i] = 0x30
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(m.UnsafeRecoveryIndex))
+		dAtA[i] = 0x38
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(m.UnsafeRecoveryTime))
+	}
+	if m.Standby {
+		dAtA[i] = 0x40
+		i++
+		dAtA[i] = 1
+		i++
+	}
+	if m.WriteFsyncMode != 0 {
+		dAtA[i] = 0x48
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(m.WriteFsyncMode))
+	}
+	if m.Volatile {
+		dAtA[i] = 0x50
+		i++
+		dAtA[i] = 1
+		i++
+	}
+	if m.Frozen {
+		dAtA[i] = 0x58
+		i++
+		dAtA[i] = 1
+		i++
+	}
+	if m.WitnessIndex > 0 {
+		dAtA[i] = 0x60
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(m.WitnessIndex))
+		dAtA[i] = 0x68
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(m.WitnessTerm))
+	}
 	return i, nil
 }
 
@@ -75,6 +133,30 @@ func (m *Bootstrap) Size() (n int) {
 	}
 	n += 2
 	n += 1 + sovRaft(uint64(m.Type))
+	if m.Promoted {
+		n += 2
+	}
+	if m.UnsafeRecoveries > 0 {
+		n += 1 + sovRaft(uint64(m.UnsafeRecoveries))
+		n += 1 + sovRaft(uint64(m.UnsafeRecoveryIndex))
+		n += 1 + sovRaft(uint64(m.UnsafeRecoveryTime))
+	}
+	if m.Standby {
+		n += 2
+	}
+	if m.WriteFsyncMode != 0 {
+		n += 1 + sovRaft(uint64(m.WriteFsyncMode))
+	}
+	if m.Volatile {
+		n += 2
+	}
+	if m.Frozen {
+		n += 2
+	}
+	if m.WitnessIndex > 0 {
+		n += 1 + sovRaft(uint64(m.WitnessIndex))
+		n += 1 + sovRaft(uint64(m.WitnessTerm))
+	}
 	return n
 }
 
@@ -259,6 +341,200 @@ func (m *Bootstrap) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Promoted", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Promoted = bool(v != 0)
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field UnsafeRecoveries", wireType)
+			}
+			m.UnsafeRecoveries = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.UnsafeRecoveries |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field UnsafeRecoveryIndex", wireType)
+			}
+			m.UnsafeRecoveryIndex = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.UnsafeRecoveryIndex |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field UnsafeRecoveryTime", wireType)
+			}
+			m.UnsafeRecoveryTime = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.UnsafeRecoveryTime |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Standby", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Standby = bool(v != 0)
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field WriteFsyncMode", wireType)
+			}
+			m.WriteFsyncMode = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.WriteFsyncMode |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 10:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Volatile", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Volatile = bool(v != 0)
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Frozen", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Frozen = bool(v != 0)
+		case 12:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field WitnessIndex", wireType)
+			}
+			m.WitnessIndex = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.WitnessIndex |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 13:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field WitnessTerm", wireType)
+			}
+			m.WitnessTerm = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.WitnessTerm |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRaft(dAtA[iNdEx:])
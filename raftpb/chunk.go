@@ -29,6 +29,8 @@ type Chunk struct {
 	BinVer         uint32
 	OnDiskIndex    uint64
 	Witness        bool
+	Locator        string
+	Fingerprint    uint64
 }
 
 func (m *Chunk) Marshal() (dAtA []byte, err error) {
@@ -142,6 +144,21 @@ func (m *Chunk) MarshalTo(dAtA []byte) (int, error) {
 		dAtA[i] = 0
 	}
 	i++
+	if len(m.Locator) > 0 {
+		dAtA[i] = 0xb2
+		i++
+		dAtA[i] = 0x1
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(len(m.Locator)))
+		i += copy(dAtA[i:], m.Locator)
+	}
+	if m.Fingerprint != 0 {
+		dAtA[i] = 0xb8
+		i++
+		dAtA[i] = 0x1
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(m.Fingerprint))
+	}
 	return i, nil
 }
 
@@ -177,6 +194,13 @@ func (m *Chunk) Size() (n int) {
 	n += 2 + sovRaft(uint64(m.BinVer))
 	n += 2 + sovRaft(uint64(m.OnDiskIndex))
 	n += 3
+	if len(m.Locator) > 0 {
+		l = len(m.Locator)
+		n += 2 + l + sovRaft(uint64(l))
+	}
+	if m.Fingerprint != 0 {
+		n += 2 + sovRaft(uint64(m.Fingerprint))
+	}
 	return n
 }
 
@@ -649,6 +673,57 @@ func (m *Chunk) Unmarshal(dAtA []byte) error {
 				}
 			}
 			m.Witness = bool(v != 0)
+		case 22:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Locator", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthRaft
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRaft
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Locator = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 23:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Fingerprint", wireType)
+			}
+			m.Fingerprint = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Fingerprint |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRaft(dAtA[iNdEx:])
@@ -12,6 +12,9 @@ type Entry struct {
 	SeriesID    uint64
 	RespondedTo uint64
 	Cmd         []byte
+	// RequestID is the optional ID of the client request that proposed the
+	// entry, it is only set when config.Config.PropagateRequestIDs is enabled.
+	RequestID []byte
 }
 
 func (m *Entry) Marshal() (dAtA []byte, err error) {
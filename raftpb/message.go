@@ -17,6 +17,21 @@ type Message struct {
 	Entries  []Entry
 	Snapshot Snapshot
 	HintHigh uint64
+	// BootstrapHash is the hash of the initial members of the shard as
+	// recorded by the sender, it is 0 when the sender joined the shard.
+	BootstrapHash uint64
+	// ElectionTimeout and HeartbeatInterval are the absolute Raft timings in
+	// milliseconds configured on the sender, they are 0 when the sender's
+	// timings are configured in terms of RTTMillisecond.
+	ElectionTimeout   uint64
+	HeartbeatInterval uint64
+	// LeaderCommit is the commit index of the leader set in heartbeat messages,
+	// unlike Commit it is not capped by the replication progress of the
+	// recipient. It is 0 when the sender doesn't provide it.
+	LeaderCommit uint64
+	// ProtocolVersion is the raftpb.ProtocolVersion supported by the sender, it
+	// is 0 when the sender predates protocol versions.
+	ProtocolVersion uint32
 }
 
 func (m *Message) Marshal() (dAtA []byte, err error) {
@@ -92,6 +107,37 @@ func (m *Message) MarshalTo(dAtA []byte) (int, error) {
 	dAtA[i] = 0x68
 	i++
 	i = encodeVarintRaft(dAtA, i, uint64(m.HintHigh))
+	if m.BootstrapHash != 0 {
+		dAtA[i] = 0x70
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(m.BootstrapHash))
+	}
+	if m.ElectionTimeout != 0 {
+		dAtA[i] = 0x78
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(m.ElectionTimeout))
+	}
+	if m.HeartbeatInterval != 0 {
+		dAtA[i] = 0x80
+		i++
+		dAtA[i] = 0x1
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(m.HeartbeatInterval))
+	}
+	if m.LeaderCommit != 0 {
+		dAtA[i] = 0x88
+		i++
+		dAtA[i] = 0x1
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(m.LeaderCommit))
+	}
+	if m.ProtocolVersion != 0 {
+		dAtA[i] = 0x90
+		i++
+		dAtA[i] = 0x1
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(m.ProtocolVersion))
+	}
 	return i, nil
 }
 
@@ -120,5 +166,20 @@ func (m *Message) Size() (n int) {
 	l = m.Snapshot.Size()
 	n += 1 + l + sovRaft(uint64(l))
 	n += 1 + sovRaft(uint64(m.HintHigh))
+	if m.BootstrapHash != 0 {
+		n += 1 + sovRaft(uint64(m.BootstrapHash))
+	}
+	if m.ElectionTimeout != 0 {
+		n += 1 + sovRaft(uint64(m.ElectionTimeout))
+	}
+	if m.HeartbeatInterval != 0 {
+		n += 2 + sovRaft(uint64(m.HeartbeatInterval))
+	}
+	if m.LeaderCommit != 0 {
+		n += 2 + sovRaft(uint64(m.LeaderCommit))
+	}
+	if m.ProtocolVersion != 0 {
+		n += 2 + sovRaft(uint64(m.ProtocolVersion))
+	}
 	return n
 }
@@ -15,8 +15,11 @@
 package raftpb
 
 import (
+	"crypto/md5"
+	"encoding/binary"
 	"fmt"
 	"math"
+	"sort"
 	"strings"
 	"unsafe"
 
@@ -37,6 +40,22 @@ var (
 const (
 	// NoNode is the flag used to indicate that the node id field is not set.
 	NoNode uint64 = 0
+	// ProtocolVersion is the version of the Raft protocol implemented by this
+	// package, it is advertised to remote replicas in Raft messages. Replicas
+	// that predate it, i.e. version 0, panic when applying the EnterJoint,
+	// LeaveJoint, PromoteWitness, UpdateAddress and ReplaceWitness config
+	// changes introduced by version 1. They also ignore the Inactive,
+	// LimitExceeded, AllowReuse and MaxRemoved fields of config changes, such
+	// fields are only honored when the config change has its ProtocolVersion
+	// set. Replicas that predate version 1 also panic on the SnapshotForward,
+	// SnapshotForwardResp, SnapshotDelegate and SnapshotDelegateResp messages,
+	// which are only sent to replicas that have advertised version 1. Fenced
+	// proposals, which such replicas can't apply, are only made once all
+	// members that apply entries have advertised version 1. Entries proposed
+	// with config.Config.PropagateRequestIDs or MaxEntryChunkBytes set can't be
+	// applied by such replicas either, those options are not gated by the
+	// advertised versions.
+	ProtocolVersion uint32 = 1
 )
 
 // IsEmptyState returns a boolean flag indicating whether the given State is
@@ -127,6 +146,32 @@ func (m *Entry) IsUpdateEntry() bool {
 		!m.IsNewSessionRequest() && !m.IsEndOfSessionRequest()
 }
 
+// IsJoint returns a boolean value indicating whether the membership is a
+// joint configuration in which both the regular nodes in Addresses and those
+// in Outgoing are required to form quorums.
+func (m Membership) IsJoint() bool {
+	return len(m.Outgoing) > 0
+}
+
+// IsRemoved returns a boolean value indicating whether the specified replica
+// has been removed from the shard. Removed replicas pruned from Removed are
+// summarized by PrunedRemovedMax, the largest pruned replica ID, pruning
+// always keeps the largest removed replica IDs so any replica ID not larger
+// than PrunedRemovedMax is considered as removed unless it is a member.
+func (m Membership) IsRemoved(replicaID uint64) bool {
+	if m.Removed[replicaID] {
+		return true
+	}
+	if m.PrunedRemovedMax == 0 || replicaID > m.PrunedRemovedMax {
+		return false
+	}
+	_, ok := m.Addresses[replicaID]
+	_, nonVoting := m.NonVotings[replicaID]
+	_, witness := m.Witnesses[replicaID]
+	_, outgoing := m.Outgoing[replicaID]
+	return !ok && !nonVoting && !witness && !outgoing
+}
+
 // NewBootstrapInfo creates and returns a new bootstrap record.
 func NewBootstrapInfo(join bool,
 	smType StateMachineType, nodes map[uint64]string) Bootstrap {
@@ -141,6 +186,43 @@ func NewBootstrapInfo(join bool,
 	return bootstrap
 }
 
+// MembersHash returns the hash of the initial members recorded in the
+// bootstrap info. The write fsync mode is also included when it is not the
+// default one. 0 is returned when the node joined the shard without any
+// initial member.
+func (b *Bootstrap) MembersHash() uint64 {
+	if b.Join || len(b.Addresses) == 0 {
+		return 0
+	}
+	ids := make([]uint64, 0, len(b.Addresses))
+	for nid := range b.Addresses {
+		ids = append(ids, nid)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	data := make([]byte, 8)
+	hash := md5.New()
+	for _, nid := range ids {
+		binary.LittleEndian.PutUint64(data, nid)
+		if _, err := hash.Write(data); err != nil {
+			panic(err)
+		}
+		if _, err := hash.Write([]byte(stringutil.CleanAddress(b.Addresses[nid]))); err != nil {
+			panic(err)
+		}
+	}
+	if b.WriteFsyncMode != 0 {
+		binary.LittleEndian.PutUint64(data, uint64(b.WriteFsyncMode))
+		if _, err := hash.Write(data); err != nil {
+			panic(err)
+		}
+	}
+	v := binary.LittleEndian.Uint64(hash.Sum(nil)[:8])
+	if v == 0 {
+		return 1
+	}
+	return v
+}
+
 // Validate checks whether the incoming nodes parameter and the join flag is
 // valid given the recorded bootstrap infomration in Log DB.
 func (b *Bootstrap) Validate(nodes map[uint64]string,
@@ -237,6 +319,7 @@ func GetEntrySliceInMemSize(ents []Entry) uint64 {
 	stSz := uint64(unsafe.Sizeof(ents[0]))
 	for _, e := range ents {
 		sz += uint64(len(e.Cmd))
+		sz += uint64(len(e.RequestID))
 		sz += stSz
 	}
 	return sz
@@ -259,6 +342,9 @@ var (
 	// PoisonChunkCount is the special chunk count value used to indicate that
 	// the processing goroutine should return.
 	PoisonChunkCount uint64 = math.MaxUint64 - 1
+	// AbortChunkCount is the special chunk count value used to indicate that
+	// the sender aborted the snapshot being streamed.
+	AbortChunkCount uint64 = math.MaxUint64 - 2
 )
 
 // IsLastChunk returns a boolean value indicating whether the chunk is the last
@@ -273,12 +359,24 @@ func (m Chunk) IsLastFileChunk() bool {
 	return m.FileChunkId+1 == m.FileChunkCount
 }
 
+// IsSideloaded returns a boolean value indicating whether the chunk carries
+// the locator of a sideloaded snapshot rather than the snapshot data.
+func (m Chunk) IsSideloaded() bool {
+	return len(m.Locator) > 0
+}
+
 // IsPoisonChunk returns a boolean value indicating whether the chunk is a
 // special poison chunk.
 func (m Chunk) IsPoisonChunk() bool {
 	return m.ChunkCount == PoisonChunkCount
 }
 
+// IsAbortChunk returns a boolean value indicating whether the chunk is a
+// special abort chunk.
+func (m Chunk) IsAbortChunk() bool {
+	return m.ChunkCount == AbortChunkCount
+}
+
 // CanDrop returns a boolean value indicating whether the message can be
 // safely dropped.
 func (m *Message) CanDrop() bool {
@@ -77,6 +77,7 @@ func (m *EntryBatch) SizeUpperLimit() (n int) {
 func (m *Entry) SizeUpperLimit() int {
 	l := settings.EntryNonCmdFieldsSize
 	l += len(m.Cmd)
+	l += len(m.RequestID)
 	return l
 }
 
@@ -151,6 +152,15 @@ func (m *Entry) Size() int {
 		}
 	}
 
+	if x := len(m.RequestID); x != 0 {
+		if uint64(x) > ColferSizeMax {
+			panic("max size reached")
+		}
+		for l += x + 2; x >= 0x80; l++ {
+			x >>= 7
+		}
+	}
+
 	if uint64(l) > ColferSizeMax {
 		panic(fmt.Sprintf("max size reached %d", l))
 	}
@@ -294,6 +304,20 @@ func (m *Entry) marshalTo(buf []byte) int {
 		i += copy(buf[i:], m.Cmd)
 	}
 
+	if l := len(m.RequestID); l != 0 {
+		buf[i] = 8
+		i++
+		x := uint(l)
+		for x >= 0x80 {
+			buf[i] = byte(x | 0x80)
+			x >>= 7
+			i++
+		}
+		buf[i] = byte(x)
+		i++
+		i += copy(buf[i:], m.RequestID)
+	}
+
 	buf[i] = 0x7f
 	i++
 	return i
@@ -301,11 +325,14 @@ func (m *Entry) marshalTo(buf []byte) int {
 
 // Unmarshal unmarshals the input to the current entry instance.
 func (m *Entry) Unmarshal(data []byte) error {
-	_, err := m.unmarshal(data)
+	_, err := m.unmarshal(data, false)
 	return err
 }
 
-func (m *Entry) unmarshal(data []byte) (int, error) {
+// unmarshal unmarshals the input to the current entry instance. When shared
+// is true, the Cmd and RequestID fields reference the input byte slice rather
+// than being copied out of it.
+func (m *Entry) unmarshal(data []byte, shared bool) (int, error) {
 	if len(data) == 0 {
 		return 0, io.EOF
 	}
@@ -636,7 +663,55 @@ func (m *Entry) unmarshal(data []byte) (int, error) {
 		}
 		// https://github.com/golang/go/wiki/SliceTricks
 		ic := data[start:i]
-		m.Cmd = append(ic[:0:0], ic...)
+		if shared {
+			m.Cmd = ic[:len(ic):len(ic)]
+		} else {
+			m.Cmd = append(ic[:0:0], ic...)
+		}
+
+		header = data[i]
+		i++
+	}
+
+	if header == 8 {
+		if i >= len(data) {
+			goto eof
+		}
+		x := uint(data[i])
+		i++
+
+		if x >= 0x80 {
+			x &= 0x7f
+			for shift := uint(7); ; shift += 7 {
+				if i >= len(data) {
+					goto eof
+				}
+				b := uint(data[i])
+				i++
+
+				if b < 0x80 {
+					x |= b << shift
+					break
+				}
+				x |= (b & 0x7f) << shift
+			}
+		}
+
+		if x > uint(ColferSizeMax) {
+			return 0, ColferMax(fmt.Sprintf("colfer: raftpb.Entry.RequestID size %d exceeds %d bytes", x, ColferSizeMax))
+		}
+
+		start := i
+		i += int(x)
+		if i >= len(data) {
+			goto eof
+		}
+		ic := data[start:i]
+		if shared {
+			m.RequestID = ic[:len(ic):len(ic)]
+		} else {
+			m.RequestID = append(ic[:0:0], ic...)
+		}
 
 		header = data[i]
 		i++
@@ -657,6 +732,10 @@ eof:
 
 // Unmarshal unmarshals the message instance using the input byte slice.
 func (m *Message) Unmarshal(dAtA []byte) error {
+	return m.unmarshal(dAtA, false)
+}
+
+func (m *Message) unmarshal(dAtA []byte, shared bool) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -907,7 +986,7 @@ func (m *Message) Unmarshal(dAtA []byte) error {
 				m.Entries = make([]Entry, 0, count)
 			}
 			m.Entries = append(m.Entries, Entry{})
-			if err := m.Entries[len(m.Entries)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+			if _, err := m.Entries[len(m.Entries)-1].unmarshal(dAtA[iNdEx:postIndex], shared); err != nil {
 				return err
 			}
 			iNdEx = postIndex
@@ -960,6 +1039,101 @@ func (m *Message) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 14:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BootstrapHash", wireType)
+			}
+			m.BootstrapHash = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.BootstrapHash |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 15:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ElectionTimeout", wireType)
+			}
+			m.ElectionTimeout = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ElectionTimeout |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 16:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field HeartbeatInterval", wireType)
+			}
+			m.HeartbeatInterval = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.HeartbeatInterval |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 17:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field LeaderCommit", wireType)
+			}
+			m.LeaderCommit = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.LeaderCommit |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 18:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ProtocolVersion", wireType)
+			}
+			m.ProtocolVersion = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ProtocolVersion |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRaft(dAtA[iNdEx:])
@@ -983,77 +1157,49 @@ func (m *Message) Unmarshal(dAtA []byte) error {
 }
 
 func (m *Message) entryCount(dAtA []byte) int {
-	l := len(dAtA)
-	iNdEx := 0
-	count := 0
-	for iNdEx < l {
-		var wire uint64
-		for shift := uint(0); ; shift += 7 {
-			b := dAtA[iNdEx]
-			iNdEx++
-			wire |= (uint64(b) & 0x7F) << shift
-			if b < 0x80 {
-				break
-			}
-		}
-		fieldNum := int32(wire >> 3)
-		if fieldNum == 11 {
-			var msglen int
-			for shift := uint(0); ; shift += 7 {
-				b := dAtA[iNdEx]
-				iNdEx++
-				msglen |= (int(b) & 0x7F) << shift
-				if b < 0x80 {
-					break
-				}
-			}
-			count++
-			postIndex := iNdEx + msglen
-			iNdEx = postIndex
-		} else {
-			return count
-		}
-	}
-	return count
+	return repeatedCount(dAtA, 11)
 }
 
 func (m *MessageBatch) messageCount(dAtA []byte) int {
-	l := len(dAtA)
+	return repeatedCount(dAtA, 1)
+}
+
+// repeatedCount returns the number of consecutive length delimited fields with
+// the specified field number at the beginning of dAtA. It is only used as a
+// capacity hint, counting stops at the first malformed field.
+func repeatedCount(dAtA []byte, fieldNum int32) int {
 	iNdEx := 0
 	count := 0
-	for iNdEx < l {
-		var wire uint64
-		for shift := uint(0); ; shift += 7 {
-			b := dAtA[iNdEx]
-			iNdEx++
-			wire |= (uint64(b) & 0x7F) << shift
-			if b < 0x80 {
-				break
-			}
+	for iNdEx < len(dAtA) {
+		wire, n := binary.Uvarint(dAtA[iNdEx:])
+		if n <= 0 || int32(wire>>3) != fieldNum || wire&0x7 != 2 {
+			return count
 		}
-		fieldNum := int32(wire >> 3)
-		if fieldNum == 1 {
-			var msglen int
-			for shift := uint(0); ; shift += 7 {
-				b := dAtA[iNdEx]
-				iNdEx++
-				msglen |= (int(b) & 0x7F) << shift
-				if b < 0x80 {
-					break
-				}
-			}
-			count++
-			postIndex := iNdEx + msglen
-			iNdEx = postIndex
-		} else {
-			break
+		iNdEx += n
+		msglen, n := binary.Uvarint(dAtA[iNdEx:])
+		if n <= 0 || msglen > uint64(len(dAtA)-iNdEx-n) {
+			return count
 		}
+		iNdEx += n + int(msglen)
+		count++
 	}
 	return count
 }
 
 // Unmarshal unmarshals the message batch instance using the input byte slice.
 func (m *MessageBatch) Unmarshal(dAtA []byte) error {
+	return m.unmarshal(dAtA, false)
+}
+
+// UnmarshalShared unmarshals the message batch instance using the input byte
+// slice. Different from Unmarshal, the Cmd and RequestID fields of all
+// unmarshaled entries reference the input byte slice, it is up to the caller
+// to copy them out before the input byte slice is modified or reused.
+func (m *MessageBatch) UnmarshalShared(dAtA []byte) error {
+	return m.unmarshal(dAtA, true)
+}
+
+func (m *MessageBatch) unmarshal(dAtA []byte, shared bool) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -1113,7 +1259,7 @@ func (m *MessageBatch) Unmarshal(dAtA []byte) error {
 				m.Requests = make([]Message, 0, count)
 			}
 			m.Requests = append(m.Requests, Message{})
-			if err := m.Requests[len(m.Requests)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+			if err := m.Requests[len(m.Requests)-1].unmarshal(dAtA[iNdEx:postIndex], shared); err != nil {
 				return err
 			}
 			iNdEx = postIndex
@@ -1209,7 +1355,7 @@ func (m *MessageBatch) Unmarshal(dAtA []byte) error {
 // SizeUpperLimit returns the upper limit size of the message.
 func (m *Message) SizeUpperLimit() int {
 	l := 0
-	l += (16 * 12)
+	l += (16 * 15)
 	l += m.Snapshot.Size()
 	if len(m.Entries) > 0 {
 		for _, e := range m.Entries {
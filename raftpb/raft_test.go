@@ -15,13 +15,17 @@
 package raftpb
 
 import (
+	"bytes"
 	"crypto/rand"
+	"fmt"
 	"math"
 	"reflect"
+	"strings"
 	"testing"
 	"unsafe"
 
 	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/internal/settings"
 	sm "github.com/lni/dragonboat/v4/statemachine"
 )
 
@@ -270,6 +274,10 @@ func TestEntrySizeUpperLimit(t *testing.T) {
 	if e1.SizeUpperLimit() < e1.Size() {
 		t.Errorf("size upper limit < size")
 	}
+	e1.RequestID = make([]byte, 16)
+	if e1.SizeUpperLimit() < e1.Size() {
+		t.Errorf("size upper limit < size")
+	}
 	e2 := Entry{}
 	if e2.SizeUpperLimit() < e2.Size() {
 		t.Errorf("size upper limit < size")
@@ -368,6 +376,39 @@ func TestMessageSizeUpperLimit(t *testing.T) {
 	}
 }
 
+func TestMessageBatchCanBeUnmarshaledShared(t *testing.T) {
+	mb := MessageBatch{
+		Requests: []Message{
+			{
+				Type: Replicate,
+				Entries: []Entry{
+					{Index: 1, Cmd: []byte("cmd1")},
+					{Index: 2, Cmd: []byte("cmd2"), RequestID: []byte("id2")},
+				},
+			},
+		},
+	}
+	data := MustMarshal(&mb)
+	shared := MessageBatch{}
+	if err := shared.UnmarshalShared(data); err != nil {
+		t.Fatalf("failed to unmarshal %v", err)
+	}
+	copied := MessageBatch{}
+	MustUnmarshal(&copied, data)
+	if !reflect.DeepEqual(&mb, &shared) || !reflect.DeepEqual(&mb, &copied) {
+		t.Fatalf("message batch changed")
+	}
+	for i := range data {
+		data[i] = 0
+	}
+	if !reflect.DeepEqual(&mb, &copied) {
+		t.Errorf("unmarshaled message batch references the input")
+	}
+	if reflect.DeepEqual(&mb, &shared) {
+		t.Errorf("shared message batch doesn't reference the input")
+	}
+}
+
 func TestMessageBatchSizeUpperLimit(t *testing.T) {
 	max64 := uint64(math.MaxUint64)
 	max32 := uint32(math.MaxUint32)
@@ -399,16 +440,18 @@ func TestGetEntrySliceInMemSize(t *testing.T) {
 	e0 := Entry{}
 	e16 := Entry{Cmd: make([]byte, 16)}
 	e64 := Entry{Cmd: make([]byte, 64)}
+	eid := Entry{Cmd: make([]byte, 16), RequestID: make([]byte, 16)}
 	tests := []struct {
 		ents []Entry
 		size uint64
 	}{
 		{[]Entry{}, 0},
-		{[]Entry{e0}, 80},
-		{[]Entry{e16}, 96},
-		{[]Entry{e64}, 144},
-		{[]Entry{e0, e64}, 224},
-		{[]Entry{e0, e16, e64}, 320},
+		{[]Entry{e0}, 104},
+		{[]Entry{e16}, 120},
+		{[]Entry{e64}, 168},
+		{[]Entry{e0, e64}, 272},
+		{[]Entry{e0, e16, e64}, 392},
+		{[]Entry{eid}, 136},
 	}
 	for idx, tt := range tests {
 		result := GetEntrySliceInMemSize(tt.ents)
@@ -472,6 +515,36 @@ func TestEntryCanBeMarshalledAndUnmarshalled(t *testing.T) {
 	}
 }
 
+func TestEntryRequestIDCanBeMarshalledAndUnmarshalled(t *testing.T) {
+	e := Entry{
+		Type:  EncodedEntry,
+		Index: 200,
+		Term:  5,
+		Key:   12345678,
+		Cmd:   []byte("test-data"),
+	}
+	sz := e.Size()
+	e.RequestID = []byte("0123456789abcdef")
+	// 1 byte header, 1 byte length and the ID itself
+	if e.Size() != sz+2+len(e.RequestID) {
+		t.Errorf("unexpected size %d, size without request ID %d", e.Size(), sz)
+	}
+	for _, cmd := range [][]byte{nil, e.Cmd} {
+		e.Cmd = cmd
+		m, err := e.Marshal()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		e2 := Entry{}
+		if err := e2.Unmarshal(m); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !reflect.DeepEqual(&e, &e2) {
+			t.Fatalf("entry changed, %+v, %+v", e, e2)
+		}
+	}
+}
+
 func TestRaftDataStatusCanBeMarshaled(t *testing.T) {
 	r := &RaftDataStatus{
 		Address:             "mydomain.com:12345",
@@ -540,3 +613,541 @@ func TestMessageCanDrop(t *testing.T) {
 		}
 	}
 }
+
+func TestChunkLocatorCanBeMarshalledAndUnmarshalled(t *testing.T) {
+	for _, locator := range []string{"", "s3://bucket/snapshot-0001"} {
+		c := Chunk{
+			ShardID:    1,
+			ReplicaID:  2,
+			ChunkCount: 1,
+			Filepath:   "snapshot.gbsnap",
+			Locator:    locator,
+		}
+		data := MustMarshal(&c)
+		if len(data) != c.Size() {
+			t.Errorf("size %d, want %d", len(data), c.Size())
+		}
+		var uc Chunk
+		MustUnmarshal(&uc, data)
+		if !reflect.DeepEqual(&c, &uc) {
+			t.Errorf("chunk changed, got %+v, want %+v", uc, c)
+		}
+		if uc.IsSideloaded() != (len(locator) > 0) {
+			t.Errorf("unexpected IsSideloaded result")
+		}
+	}
+}
+
+func TestFingerprintCanBeMarshaled(t *testing.T) {
+	for _, fp := range []uint64{0, 1, math.MaxUint64} {
+		ss := Snapshot{Index: 100, Term: 2, Fingerprint: fp}
+		data := MustMarshal(&ss)
+		if len(data) != ss.Size() {
+			t.Errorf("unexpected size %d, want %d", len(data), ss.Size())
+		}
+		var result Snapshot
+		MustUnmarshal(&result, data)
+		if result.Index != ss.Index || result.Fingerprint != fp {
+			t.Errorf("unexpected snapshot %+v", result)
+		}
+		c := Chunk{ShardID: 1, ReplicaID: 2, ChunkCount: 1, Fingerprint: fp}
+		data = MustMarshal(&c)
+		if len(data) != c.Size() {
+			t.Errorf("size %d, want %d", len(data), c.Size())
+		}
+		var uc Chunk
+		MustUnmarshal(&uc, data)
+		if !reflect.DeepEqual(&c, &uc) {
+			t.Errorf("chunk changed, got %+v, want %+v", uc, c)
+		}
+	}
+}
+
+func TestJointMembershipCanBeMarshaled(t *testing.T) {
+	m := Membership{
+		ConfigChangeId: 100,
+		Addresses:      map[uint64]string{1: "a1", 4: "a4"},
+		Outgoing:       map[uint64]string{1: "a1", 2: "a2", 3: "a3"},
+	}
+	var result Membership
+	MustUnmarshal(&result, MustMarshal(&m))
+	if !result.IsJoint() || !reflect.DeepEqual(m.Outgoing, result.Outgoing) ||
+		!reflect.DeepEqual(m.Addresses, result.Addresses) {
+		t.Errorf("unexpected membership %+v", result)
+	}
+	cc := ConfigChange{
+		Type:    EnterJoint,
+		Members: map[uint64]string{1: "a1", 4: "a4"},
+	}
+	var ccr ConfigChange
+	MustUnmarshal(&ccr, MustMarshal(&cc))
+	if ccr.Type != EnterJoint || !reflect.DeepEqual(cc.Members, ccr.Members) {
+		t.Errorf("unexpected config change %+v", ccr)
+	}
+}
+
+func TestStagedMembershipCanBeMarshaled(t *testing.T) {
+	m := Membership{
+		NonVotings: map[uint64]string{2: "a2"},
+		Staged:     map[uint64]bool{2: true},
+	}
+	var result Membership
+	MustUnmarshal(&result, MustMarshal(&m))
+	if !reflect.DeepEqual(m.Staged, result.Staged) {
+		t.Errorf("unexpected membership %+v", result)
+	}
+	cc := ConfigChange{Type: AddNonVoting, ReplicaID: 2, Staged: true}
+	var ccr ConfigChange
+	MustUnmarshal(&ccr, MustMarshal(&cc))
+	if !ccr.Staged {
+		t.Errorf("staged flag lost")
+	}
+}
+
+func TestSnapshotCreatedAtCanBeMarshaled(t *testing.T) {
+	for _, createdAt := range []int64{0, 1234567890123456789} {
+		ss := Snapshot{Index: 100, Term: 2, CreatedAt: createdAt}
+		data := MustMarshal(&ss)
+		if len(data) != ss.Size() {
+			t.Errorf("unexpected size %d, want %d", len(data), ss.Size())
+		}
+		var result Snapshot
+		MustUnmarshal(&result, data)
+		if result.Index != ss.Index || result.CreatedAt != createdAt {
+			t.Errorf("unexpected snapshot %+v", result)
+		}
+	}
+}
+
+func TestSnapshotFileChecksumCanBeMarshaled(t *testing.T) {
+	for _, checksum := range [][]byte{nil, {1, 2, 3, 4}} {
+		f := SnapshotFile{Filepath: "f1", FileSize: 100, FileId: 2, Checksum: checksum}
+		data := MustMarshal(&f)
+		if len(data) != f.Size() {
+			t.Errorf("unexpected size %d, want %d", len(data), f.Size())
+		}
+		var result SnapshotFile
+		MustUnmarshal(&result, data)
+		if result.FileId != f.FileId || !bytes.Equal(result.Checksum, checksum) {
+			t.Errorf("unexpected file %+v", result)
+		}
+	}
+}
+
+func TestMembershipHistoryCanBeMarshaled(t *testing.T) {
+	m := Membership{
+		Addresses: map[uint64]string{1: "a1"},
+		History: []ConfigChangeRecord{
+			{Index: 100, Term: 2, Type: AddNode, ReplicaID: 2, Address: "a2",
+				Timestamp: 1234567890},
+			{Index: 200, Term: 3, Type: RemoveNode, ReplicaID: 2, Timestamp: -1},
+		},
+	}
+	data := MustMarshal(&m)
+	if len(data) != m.Size() {
+		t.Errorf("unexpected size %d, want %d", len(data), m.Size())
+	}
+	var result Membership
+	MustUnmarshal(&result, data)
+	if !reflect.DeepEqual(m.History, result.History) {
+		t.Errorf("unexpected history %+v", result.History)
+	}
+}
+
+func TestRetiredAddressesCanBeMarshaled(t *testing.T) {
+	m := Membership{
+		Addresses: map[uint64]string{1: "a1", 2: "a4"},
+		Retired:   map[string]uint64{"a2": 2, "a3": 2},
+	}
+	data := MustMarshal(&m)
+	if len(data) != m.Size() {
+		t.Errorf("unexpected size %d, want %d", len(data), m.Size())
+	}
+	var result Membership
+	MustUnmarshal(&result, data)
+	if !reflect.DeepEqual(m, result) {
+		t.Errorf("unexpected membership %+v", result)
+	}
+}
+
+func TestPrunedRemovedReplicasCanBeMarshaled(t *testing.T) {
+	m := Membership{
+		Addresses: map[uint64]string{1: "a1"},
+		Removed:   map[uint64]bool{3: true},
+	}
+	data := MustMarshal(&m)
+	m.PrunedRemovedCount = 300
+	m.PrunedRemovedHash = math.MaxUint64
+	m.PrunedRemovedMax = 2
+	pruned := MustMarshal(&m)
+	if len(pruned) != len(data)+3+11+2 || m.Size() != len(pruned) {
+		t.Errorf("unexpected size %d, %d", len(data), len(pruned))
+	}
+	// fields unknown to old versions are ignored
+	if !bytes.Equal(pruned[:len(data)], data) {
+		t.Errorf("unexpected prefix")
+	}
+	var result Membership
+	MustUnmarshal(&result, pruned)
+	if !reflect.DeepEqual(m, result) {
+		t.Errorf("unexpected membership %+v", result)
+	}
+	cc := ConfigChange{Type: RemoveNode, ReplicaID: 2}
+	data = MustMarshal(&cc)
+	cc.MaxRemoved = 1024
+	if len(MustMarshal(&cc)) != len(data)+3 {
+		t.Errorf("unexpected size")
+	}
+	var rcc ConfigChange
+	MustUnmarshal(&rcc, MustMarshal(&cc))
+	if !reflect.DeepEqual(cc, rcc) {
+		t.Errorf("unexpected config change %+v", rcc)
+	}
+	cc = ConfigChange{Type: ReplaceWitness, ReplicaID: 4, ReplacedID: 3}
+	rcc = ConfigChange{}
+	MustUnmarshal(&rcc, MustMarshal(&cc))
+	if !reflect.DeepEqual(cc, rcc) {
+		t.Errorf("unexpected config change %+v", rcc)
+	}
+	cc = ConfigChange{Type: AddNode, ReplicaID: 4, Address: "a4"}
+	data = MustMarshal(&cc)
+	cc.ProtocolVersion = ProtocolVersion
+	stamped := MustMarshal(&cc)
+	if len(stamped) != len(data)+2 || cc.Size() != len(stamped) {
+		t.Errorf("unexpected size")
+	}
+	rcc = ConfigChange{}
+	MustUnmarshal(&rcc, stamped)
+	if !reflect.DeepEqual(cc, rcc) {
+		t.Errorf("unexpected config change %+v", rcc)
+	}
+}
+
+func TestIsRemoved(t *testing.T) {
+	m := Membership{
+		Addresses:  map[uint64]string{1: "a1"},
+		NonVotings: map[uint64]string{2: "a2"},
+		Witnesses:  map[uint64]string{3: "a3"},
+		Removed:    map[uint64]bool{20: true},
+	}
+	tests := []struct {
+		replicaID uint64
+		max       uint64
+		removed   bool
+	}{
+		{1, 0, false},
+		{4, 0, false},
+		{20, 0, true},
+		{20, 10, true},
+		{4, 10, true},
+		{10, 10, true},
+		{11, 10, false},
+		{1, 10, false},
+		{2, 10, false},
+		{3, 10, false},
+	}
+	for idx, tt := range tests {
+		m.PrunedRemovedMax = tt.max
+		if v := m.IsRemoved(tt.replicaID); v != tt.removed {
+			t.Errorf("%d, got %t, want %t", idx, v, tt.removed)
+		}
+	}
+}
+
+func TestMaxSizeBootstrapCanBeValidated(t *testing.T) {
+	nodes := make(map[uint64]string)
+	for nid := uint64(1); nid <= settings.MaxMembers; nid++ {
+		prefix := fmt.Sprintf("%d:", nid)
+		nodes[nid] = prefix + strings.Repeat("a",
+			int(settings.MaxAddressLength)-len(prefix))
+	}
+	bootstrap := NewBootstrapInfo(false, RegularStateMachine, nodes)
+	var result Bootstrap
+	MustUnmarshal(&result, MustMarshal(&bootstrap))
+	if !reflect.DeepEqual(bootstrap, result) {
+		t.Fatalf("unexpected bootstrap record")
+	}
+	if !result.Validate(nodes, false, RegularStateMachine) {
+		t.Errorf("max size bootstrap record not valid")
+	}
+	delete(nodes, settings.MaxMembers)
+	if result.Validate(nodes, false, RegularStateMachine) {
+		t.Errorf("inconsistent bootstrap record not detected")
+	}
+}
+
+func TestPromotedBootstrapCanBeMarshaled(t *testing.T) {
+	bs := Bootstrap{Join: true, Type: OnDiskStateMachine}
+	data := MustMarshal(&bs)
+	bs.Promoted = true
+	promoted := MustMarshal(&bs)
+	if len(promoted) != len(data)+2 || bs.Size() != len(promoted) {
+		t.Errorf("unexpected size %d, %d", len(data), len(promoted))
+	}
+	var result Bootstrap
+	MustUnmarshal(&result, promoted)
+	if !reflect.DeepEqual(bs, result) {
+		t.Errorf("unexpected bootstrap %+v", result)
+	}
+	bs = Bootstrap{Join: true, WitnessIndex: 1000, WitnessTerm: 5}
+	result = Bootstrap{}
+	MustUnmarshal(&result, MustMarshal(&bs))
+	if !reflect.DeepEqual(bs, result) {
+		t.Errorf("unexpected bootstrap %+v", result)
+	}
+}
+
+func TestStandbyBootstrapCanBeMarshaled(t *testing.T) {
+	bs := Bootstrap{Join: true, Type: RegularStateMachine}
+	data := MustMarshal(&bs)
+	bs.Standby = true
+	standby := MustMarshal(&bs)
+	if len(standby) != len(data)+2 || bs.Size() != len(standby) {
+		t.Errorf("unexpected size %d, %d", len(data), len(standby))
+	}
+	var result Bootstrap
+	MustUnmarshal(&result, standby)
+	if !reflect.DeepEqual(bs, result) {
+		t.Errorf("unexpected bootstrap %+v", result)
+	}
+}
+
+func TestWriteFsyncModeBootstrapCanBeMarshaled(t *testing.T) {
+	bs := Bootstrap{Join: true, Type: RegularStateMachine}
+	data := MustMarshal(&bs)
+	bs.WriteFsyncMode = 1
+	relaxed := MustMarshal(&bs)
+	if len(relaxed) != len(data)+2 || bs.Size() != len(relaxed) {
+		t.Errorf("unexpected size %d, %d", len(data), len(relaxed))
+	}
+	var result Bootstrap
+	MustUnmarshal(&result, relaxed)
+	if !reflect.DeepEqual(bs, result) {
+		t.Errorf("unexpected bootstrap %+v", result)
+	}
+}
+
+func TestVolatileBootstrapCanBeMarshaled(t *testing.T) {
+	bs := Bootstrap{Join: true, Type: RegularStateMachine}
+	data := MustMarshal(&bs)
+	bs.Volatile = true
+	volatile := MustMarshal(&bs)
+	if len(volatile) != len(data)+2 || bs.Size() != len(volatile) {
+		t.Errorf("unexpected size %d, %d", len(data), len(volatile))
+	}
+	var result Bootstrap
+	MustUnmarshal(&result, volatile)
+	if !reflect.DeepEqual(bs, result) {
+		t.Errorf("unexpected bootstrap %+v", result)
+	}
+}
+
+func TestRecoveredBootstrapCanBeMarshaled(t *testing.T) {
+	bs := Bootstrap{
+		Addresses:           map[uint64]string{1: "a1", 2: "a2"},
+		Type:                RegularStateMachine,
+		UnsafeRecoveries:    2,
+		UnsafeRecoveryIndex: 1000,
+		UnsafeRecoveryTime:  1700000000,
+	}
+	data := MustMarshal(&bs)
+	if bs.Size() != len(data) {
+		t.Errorf("unexpected size %d, %d", bs.Size(), len(data))
+	}
+	var result Bootstrap
+	MustUnmarshal(&result, data)
+	if !reflect.DeepEqual(bs, result) {
+		t.Errorf("unexpected bootstrap %+v", result)
+	}
+}
+
+func TestUnsafeConfigChangeCanBeMarshaled(t *testing.T) {
+	cc := ConfigChange{Type: RemoveNode, ReplicaID: 2}
+	data := MustMarshal(&cc)
+	cc.Force = true
+	cc.Inactive = []uint64{3, 300}
+	cc.LimitExceeded = true
+	cc.AllowReuse = true
+	unsafe := MustMarshal(&cc)
+	if len(unsafe) != len(data)+11 || cc.Size() != len(unsafe) {
+		t.Errorf("unexpected size %d, %d", len(data), len(unsafe))
+	}
+	var result ConfigChange
+	MustUnmarshal(&result, unsafe)
+	if !reflect.DeepEqual(cc, result) {
+		t.Errorf("unexpected config change %+v", result)
+	}
+}
+
+func TestMessageBootstrapHashCanBeMarshaled(t *testing.T) {
+	m := Message{Type: Replicate, To: 2, From: 1, ShardID: 1, Term: 2}
+	data := MustMarshal(&m)
+	m.BootstrapHash = math.MaxUint64
+	withHash := MustMarshal(&m)
+	if len(withHash) != len(data)+11 || m.Size() != len(withHash) {
+		t.Errorf("unexpected size %d, %d", len(data), len(withHash))
+	}
+	var result Message
+	MustUnmarshal(&result, withHash)
+	if !reflect.DeepEqual(m, result) {
+		t.Errorf("unexpected message %+v", result)
+	}
+	if m.SizeUpperLimit() < len(withHash) {
+		t.Errorf("unexpected size upper limit")
+	}
+}
+
+func TestMessageTimingsCanBeMarshaled(t *testing.T) {
+	m := Message{Type: Heartbeat, To: 2, From: 1, ShardID: 1, Term: 2}
+	data := MustMarshal(&m)
+	m.ElectionTimeout = 1000
+	m.HeartbeatInterval = math.MaxUint64
+	withTimings := MustMarshal(&m)
+	if len(withTimings) != len(data)+15 || m.Size() != len(withTimings) {
+		t.Errorf("unexpected size %d, %d", len(data), len(withTimings))
+	}
+	var result Message
+	MustUnmarshal(&result, withTimings)
+	if !reflect.DeepEqual(m, result) {
+		t.Errorf("unexpected message %+v", result)
+	}
+	if m.SizeUpperLimit() < len(withTimings) {
+		t.Errorf("unexpected size upper limit")
+	}
+}
+
+func TestMessageLeaderCommitCanBeMarshaled(t *testing.T) {
+	m := Message{Type: Heartbeat, To: 2, From: 1, ShardID: 1, Term: 2}
+	data := MustMarshal(&m)
+	m.LeaderCommit = math.MaxUint64
+	withCommit := MustMarshal(&m)
+	if len(withCommit) != len(data)+12 || m.Size() != len(withCommit) {
+		t.Errorf("unexpected size %d, %d", len(data), len(withCommit))
+	}
+	var result Message
+	MustUnmarshal(&result, withCommit)
+	if !reflect.DeepEqual(m, result) {
+		t.Errorf("unexpected message %+v", result)
+	}
+	if m.SizeUpperLimit() < len(withCommit) {
+		t.Errorf("unexpected size upper limit")
+	}
+}
+
+func TestMessageProtocolVersionCanBeMarshaled(t *testing.T) {
+	m := Message{Type: HeartbeatResp, To: 1, From: 2, ShardID: 1, Term: 2}
+	data := MustMarshal(&m)
+	m.ProtocolVersion = math.MaxUint32
+	withVersion := MustMarshal(&m)
+	if len(withVersion) != len(data)+7 || m.Size() != len(withVersion) {
+		t.Errorf("unexpected size %d, %d", len(data), len(withVersion))
+	}
+	var result Message
+	MustUnmarshal(&result, withVersion)
+	if !reflect.DeepEqual(m, result) {
+		t.Errorf("unexpected message %+v", result)
+	}
+	if m.SizeUpperLimit() < len(withVersion) {
+		t.Errorf("unexpected size upper limit")
+	}
+}
+
+func TestBootstrapMembersHash(t *testing.T) {
+	bs1 := NewBootstrapInfo(false, RegularStateMachine,
+		map[uint64]string{1: "a1:123", 2: "a2:123"})
+	bs2 := NewBootstrapInfo(false, OnDiskStateMachine,
+		map[uint64]string{2: " a2:123 ", 1: "a1:123"})
+	bs3 := NewBootstrapInfo(false, RegularStateMachine,
+		map[uint64]string{1: "a1:123", 3: "a2:123"})
+	if bs1.MembersHash() == 0 || bs1.MembersHash() != bs2.MembersHash() {
+		t.Errorf("unexpected hash values")
+	}
+	if bs1.MembersHash() == bs3.MembersHash() {
+		t.Errorf("same hash for different members")
+	}
+	relaxed := bs1
+	relaxed.WriteFsyncMode = 1
+	if relaxed.MembersHash() == bs1.MembersHash() {
+		t.Errorf("same hash for different write fsync modes")
+	}
+	join := NewBootstrapInfo(true, RegularStateMachine, nil)
+	if join.MembersHash() != 0 {
+		t.Errorf("unexpected hash for joining node")
+	}
+}
+
+func FuzzMessageBatchDecode(f *testing.F) {
+	ss := Snapshot{
+		Index:    100,
+		Term:     2,
+		Filepath: "snapshot-0000000000000064.gbsnap",
+		FileSize: 1024,
+		Membership: Membership{
+			Addresses: map[uint64]string{1: "a1", 2: "a2"},
+			Removed:   map[uint64]bool{3: true},
+		},
+		Files: []*SnapshotFile{{Filepath: "f1", FileSize: 1, FileId: 1}},
+	}
+	batches := []MessageBatch{
+		{},
+		{
+			DeploymentId:  1,
+			BinVer:        2,
+			SourceAddress: "a1",
+			Requests: []Message{
+				{
+					Type:    Replicate,
+					To:      2,
+					From:    1,
+					ShardID: 1,
+					Entries: []Entry{
+						{Index: 1, Term: 1, Cmd: []byte("cmd1")},
+						{Index: 2, Term: 1, Cmd: []byte("cmd2"), RequestID: []byte("id2")},
+						{Index: 3, Term: 1, Type: ConfigChangeEntry, Key: 1, ClientID: 2},
+					},
+				},
+				{Type: Heartbeat, To: 3, From: 1, ShardID: 1, Commit: 3},
+			},
+		},
+		{Requests: []Message{{Type: InstallSnapshot, Snapshot: ss}}},
+		{Requests: []Message{getMaxSizedMsg()}},
+	}
+	for _, b := range batches {
+		f.Add(MustMarshal(&b))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, shared := range []bool{false, true} {
+			var mb MessageBatch
+			if err := mb.unmarshal(data, shared); err != nil {
+				continue
+			}
+			if mb.Size() > mb.SizeUpperLimit() {
+				t.Fatalf("size %d > size upper limit %d",
+					mb.Size(), mb.SizeUpperLimit())
+			}
+			encoded, err := mb.Marshal()
+			if err != nil {
+				t.Fatalf("failed to marshal decoded batch %v", err)
+			}
+			var decoded MessageBatch
+			if err := decoded.Unmarshal(encoded); err != nil {
+				t.Fatalf("failed to unmarshal re-encoded batch %v", err)
+			}
+		}
+	})
+}
+
+func TestFrozenBootstrapCanBeMarshaled(t *testing.T) {
+	bs := Bootstrap{Join: true, Type: RegularStateMachine}
+	data := MustMarshal(&bs)
+	bs.Frozen = true
+	frozen := MustMarshal(&bs)
+	if len(frozen) != len(data)+2 || bs.Size() != len(frozen) {
+		t.Errorf("unexpected size %d, %d", len(data), len(frozen))
+	}
+	var result Bootstrap
+	MustUnmarshal(&result, frozen)
+	if !reflect.DeepEqual(bs, result) {
+		t.Errorf("unexpected bootstrap %+v", result)
+	}
+}
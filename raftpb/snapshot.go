@@ -27,6 +27,8 @@ type Snapshot struct {
 	Imported    bool
 	OnDiskIndex uint64
 	Witness     bool
+	CreatedAt   int64
+	Fingerprint uint64
 	// refCount will not be marshaled
 	refCount  *int32
 	compactor ICompactor
@@ -146,6 +148,18 @@ func (m *Snapshot) MarshalTo(dAtA []byte) (int, error) {
 		dAtA[i] = 0
 	}
 	i++
+	if m.CreatedAt != 0 {
+		dAtA[i] = 0x78
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(m.CreatedAt))
+	}
+	if m.Fingerprint != 0 {
+		dAtA[i] = 0x80
+		i++
+		dAtA[i] = 0x1
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(m.Fingerprint))
+	}
 	return i, nil
 }
 
@@ -178,6 +192,12 @@ func (m *Snapshot) Size() (n int) {
 	n += 2
 	n += 1 + sovRaft(uint64(m.OnDiskIndex))
 	n += 2
+	if m.CreatedAt != 0 {
+		n += 1 + sovRaft(uint64(m.CreatedAt))
+	}
+	if m.Fingerprint != 0 {
+		n += 2 + sovRaft(uint64(m.Fingerprint))
+	}
 	return n
 }
 
@@ -517,6 +537,44 @@ func (m *Snapshot) Unmarshal(dAtA []byte) error {
 				}
 			}
 			m.Witness = bool(v != 0)
+		case 15:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CreatedAt", wireType)
+			}
+			m.CreatedAt = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.CreatedAt |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 16:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Fingerprint", wireType)
+			}
+			m.Fingerprint = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Fingerprint |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRaft(dAtA[iNdEx:])
@@ -13,6 +13,7 @@ type SnapshotFile struct {
 	FileSize uint64
 	FileId   uint64
 	Metadata []byte
+	Checksum []byte
 }
 
 func (m *SnapshotFile) Marshal() (dAtA []byte, err error) {
@@ -46,6 +47,12 @@ func (m *SnapshotFile) MarshalTo(dAtA []byte) (int, error) {
 		i = encodeVarintRaft(dAtA, i, uint64(len(m.Metadata)))
 		i += copy(dAtA[i:], m.Metadata)
 	}
+	if m.Checksum != nil {
+		dAtA[i] = 0x32
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(len(m.Checksum)))
+		i += copy(dAtA[i:], m.Checksum)
+	}
 	return i, nil
 }
 
@@ -63,6 +70,10 @@ func (m *SnapshotFile) Size() (n int) {
 		l = len(m.Metadata)
 		n += 1 + l + sovRaft(uint64(l))
 	}
+	if m.Checksum != nil {
+		l = len(m.Checksum)
+		n += 1 + l + sovRaft(uint64(l))
+	}
 	return n
 }
 
@@ -199,6 +210,40 @@ func (m *SnapshotFile) Unmarshal(dAtA []byte) error {
 				m.Metadata = []byte{}
 			}
 			iNdEx = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Checksum", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthRaft
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRaft
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Checksum = append(m.Checksum[:0], dAtA[iNdEx:postIndex]...)
+			if m.Checksum == nil {
+				m.Checksum = []byte{}
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRaft(dAtA[iNdEx:])
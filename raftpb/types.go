@@ -6,35 +6,39 @@ package raftpb
 type MessageType int32
 
 const (
-	LocalTick          MessageType = 0
-	Election           MessageType = 1
-	LeaderHeartbeat    MessageType = 2
-	ConfigChangeEvent  MessageType = 3
-	NoOP               MessageType = 4
-	Ping               MessageType = 5
-	Pong               MessageType = 6
-	Propose            MessageType = 7
-	SnapshotStatus     MessageType = 8
-	Unreachable        MessageType = 9
-	CheckQuorum        MessageType = 10
-	BatchedReadIndex   MessageType = 11
-	Replicate          MessageType = 12
-	ReplicateResp      MessageType = 13
-	RequestVote        MessageType = 14
-	RequestVoteResp    MessageType = 15
-	InstallSnapshot    MessageType = 16
-	Heartbeat          MessageType = 17
-	HeartbeatResp      MessageType = 18
-	ReadIndex          MessageType = 19
-	ReadIndexResp      MessageType = 20
-	Quiesce            MessageType = 21
-	SnapshotReceived   MessageType = 22
-	LeaderTransfer     MessageType = 23
-	TimeoutNow         MessageType = 24
-	RateLimit          MessageType = 25
-	RequestPreVote     MessageType = 26
-	RequestPreVoteResp MessageType = 27
-	LogQuery           MessageType = 28
+	LocalTick            MessageType = 0
+	Election             MessageType = 1
+	LeaderHeartbeat      MessageType = 2
+	ConfigChangeEvent    MessageType = 3
+	NoOP                 MessageType = 4
+	Ping                 MessageType = 5
+	Pong                 MessageType = 6
+	Propose              MessageType = 7
+	SnapshotStatus       MessageType = 8
+	Unreachable          MessageType = 9
+	CheckQuorum          MessageType = 10
+	BatchedReadIndex     MessageType = 11
+	Replicate            MessageType = 12
+	ReplicateResp        MessageType = 13
+	RequestVote          MessageType = 14
+	RequestVoteResp      MessageType = 15
+	InstallSnapshot      MessageType = 16
+	Heartbeat            MessageType = 17
+	HeartbeatResp        MessageType = 18
+	ReadIndex            MessageType = 19
+	ReadIndexResp        MessageType = 20
+	Quiesce              MessageType = 21
+	SnapshotReceived     MessageType = 22
+	LeaderTransfer       MessageType = 23
+	TimeoutNow           MessageType = 24
+	RateLimit            MessageType = 25
+	RequestPreVote       MessageType = 26
+	RequestPreVoteResp   MessageType = 27
+	LogQuery             MessageType = 28
+	SnapshotForward      MessageType = 29
+	SnapshotForwardResp  MessageType = 30
+	SnapshotDelegate     MessageType = 31
+	SnapshotDelegateResp MessageType = 32
 )
 
 var MessageType_name = map[int32]string{
@@ -67,38 +71,46 @@ var MessageType_name = map[int32]string{
 	26: "RequestPreVote",
 	27: "RequestPreVoteResp",
 	28: "LogQuery",
+	29: "SnapshotForward",
+	30: "SnapshotForwardResp",
+	31: "SnapshotDelegate",
+	32: "SnapshotDelegateResp",
 }
 
 var MessageType_value = map[string]int32{
-	"LocalTick":          0,
-	"Election":           1,
-	"LeaderHeartbeat":    2,
-	"ConfigChangeEvent":  3,
-	"NoOP":               4,
-	"Ping":               5,
-	"Pong":               6,
-	"Propose":            7,
-	"SnapshotStatus":     8,
-	"Unreachable":        9,
-	"CheckQuorum":        10,
-	"BatchedReadIndex":   11,
-	"Replicate":          12,
-	"ReplicateResp":      13,
-	"RequestVote":        14,
-	"RequestVoteResp":    15,
-	"InstallSnapshot":    16,
-	"Heartbeat":          17,
-	"HeartbeatResp":      18,
-	"ReadIndex":          19,
-	"ReadIndexResp":      20,
-	"Quiesce":            21,
-	"SnapshotReceived":   22,
-	"LeaderTransfer":     23,
-	"TimeoutNow":         24,
-	"RateLimit":          25,
-	"RequestPreVote":     26,
-	"RequestPreVoteResp": 27,
-	"LogQuery":           28,
+	"LocalTick":            0,
+	"Election":             1,
+	"LeaderHeartbeat":      2,
+	"ConfigChangeEvent":    3,
+	"NoOP":                 4,
+	"Ping":                 5,
+	"Pong":                 6,
+	"Propose":              7,
+	"SnapshotStatus":       8,
+	"Unreachable":          9,
+	"CheckQuorum":          10,
+	"BatchedReadIndex":     11,
+	"Replicate":            12,
+	"ReplicateResp":        13,
+	"RequestVote":          14,
+	"RequestVoteResp":      15,
+	"InstallSnapshot":      16,
+	"Heartbeat":            17,
+	"HeartbeatResp":        18,
+	"ReadIndex":            19,
+	"ReadIndexResp":        20,
+	"Quiesce":              21,
+	"SnapshotReceived":     22,
+	"LeaderTransfer":       23,
+	"TimeoutNow":           24,
+	"RateLimit":            25,
+	"RequestPreVote":       26,
+	"RequestPreVoteResp":   27,
+	"LogQuery":             28,
+	"SnapshotForward":      29,
+	"SnapshotForwardResp":  30,
+	"SnapshotDelegate":     31,
+	"SnapshotDelegateResp": 32,
 }
 
 func (x MessageType) String() string {
@@ -135,10 +147,15 @@ func (x EntryType) String() string {
 type ConfigChangeType int32
 
 const (
-	AddNode      ConfigChangeType = 0
-	RemoveNode   ConfigChangeType = 1
-	AddNonVoting ConfigChangeType = 2
-	AddWitness   ConfigChangeType = 3
+	AddNode        ConfigChangeType = 0
+	RemoveNode     ConfigChangeType = 1
+	AddNonVoting   ConfigChangeType = 2
+	AddWitness     ConfigChangeType = 3
+	EnterJoint     ConfigChangeType = 4
+	LeaveJoint     ConfigChangeType = 5
+	PromoteWitness ConfigChangeType = 6
+	UpdateAddress  ConfigChangeType = 7
+	ReplaceWitness ConfigChangeType = 8
 )
 
 var ConfigChangeType_name = map[int32]string{
@@ -146,13 +163,23 @@ var ConfigChangeType_name = map[int32]string{
 	1: "RemoveNode",
 	2: "AddNonVoting",
 	3: "AddWitness",
+	4: "EnterJoint",
+	5: "LeaveJoint",
+	6: "PromoteWitness",
+	7: "UpdateAddress",
+	8: "ReplaceWitness",
 }
 
 var ConfigChangeType_value = map[string]int32{
-	"AddNode":      0,
-	"RemoveNode":   1,
-	"AddNonVoting": 2,
-	"AddWitness":   3,
+	"AddNode":        0,
+	"RemoveNode":     1,
+	"AddNonVoting":   2,
+	"AddWitness":     3,
+	"EnterJoint":     4,
+	"LeaveJoint":     5,
+	"PromoteWitness": 6,
+	"UpdateAddress":  7,
+	"ReplaceWitness": 8,
 }
 
 func (x ConfigChangeType) String() string {
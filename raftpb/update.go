@@ -81,6 +81,9 @@ type Update struct {
 	// whether CommittedEntries can be applied without waiting for the Update
 	// to be persisted to disk
 	FastApply bool
+	// whether the Update can be acknowledged once written to the LogDB without
+	// being synced to disk
+	RelaxedFsync bool
 	// EntriesToSave are entries waiting to be stored onto persistent storage.
 	EntriesToSave []Entry
 	// CommittedEntries are entries already committed in raft and ready to be
@@ -107,6 +110,10 @@ type Update struct {
 	// DroppedReadIndexes is a list of read index requests  dropped when no leader
 	// is available.
 	DroppedReadIndexes []SystemCtx
+	// UncommittedEntries is a list of entries not committed when the leader
+	// stepped down after losing contact with the quorum, the outcome of such
+	// entries is unknown.
+	UncommittedEntries []Entry
 	LogQueryResult     LogQueryResult
 	LeaderUpdate       LeaderUpdate
 }
@@ -120,7 +127,8 @@ func (u *Update) HasUpdate() bool {
 		len(u.CommittedEntries) > 0 ||
 		len(u.Messages) > 0 ||
 		len(u.ReadyToReads) > 0 ||
-		len(u.DroppedEntries) > 0
+		len(u.DroppedEntries) > 0 ||
+		len(u.UncommittedEntries) > 0
 }
 
 // MarshalTo encodes the fields that need to be persisted to the specified
@@ -0,0 +1,282 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/logdb"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// ErrReadOnlyReplicaOpen indicates that the requested operation can not be
+// completed as the replica is currently opened as a read-only replica.
+var ErrReadOnlyReplicaOpen = errors.New("read-only replica is open")
+
+// ReadOnlyReplica is a read-only view of the state machine of a stopped local
+// replica. It is created by recovering a new state machine instance from the
+// latest local snapshot and applying all committed entries found in the local
+// Raft log, the replica does not participate in Raft and is never updated
+// once opened.
+type ReadOnlyReplica struct {
+	mu        sync.Mutex
+	nh        *NodeHost
+	shardID   uint64
+	replicaID uint64
+	index     uint64
+	sm        *rsm.StateMachine
+	stopc     chan struct{}
+	closed    bool
+}
+
+// OpenReadOnlyReplica opens the specified stopped local replica backed by a
+// regular state machine as a read-only replica. It is intended for inspecting
+// the state of a replica in emergencies, e.g. when its shard lost its quorum,
+// without starting the replica or contacting any other NodeHost.
+//
+// ErrShardNotStopped is returned when the replica is running on the NodeHost.
+// StartReplica, RemoveData and other attempts to open the replica fail with
+// ErrReadOnlyReplicaOpen until the returned ReadOnlyReplica is closed.
+func (nh *NodeHost) OpenReadOnlyReplica(shardID uint64, replicaID uint64,
+	create sm.CreateStateMachineFunc) (*ReadOnlyReplica, error) {
+	cf := func(cfg config.Config, done <-chan struct{}) rsm.IManagedStateMachine {
+		sm := create(shardID, replicaID)
+		return rsm.NewNativeSM(cfg, rsm.NewInMemStateMachine(sm), done)
+	}
+	return nh.openReadOnlyReplica(shardID,
+		replicaID, cf, pb.RegularStateMachine)
+}
+
+// OpenConcurrentReadOnlyReplica is similar to the OpenReadOnlyReplica method
+// but it is used to open a replica backed by a concurrent state machine.
+func (nh *NodeHost) OpenConcurrentReadOnlyReplica(shardID uint64,
+	replicaID uint64,
+	create sm.CreateConcurrentStateMachineFunc) (*ReadOnlyReplica, error) {
+	cf := func(cfg config.Config, done <-chan struct{}) rsm.IManagedStateMachine {
+		sm := create(shardID, replicaID)
+		return rsm.NewNativeSM(cfg, rsm.NewConcurrentStateMachine(sm), done)
+	}
+	return nh.openReadOnlyReplica(shardID,
+		replicaID, cf, pb.ConcurrentStateMachine)
+}
+
+// OpenOnDiskReadOnlyReplica is similar to the OpenReadOnlyReplica method but
+// it is used to open a replica backed by an IOnDiskStateMachine. The on disk
+// state machine is opened from its existing data, committed entries not yet
+// applied to it are applied when the read-only replica is opened.
+func (nh *NodeHost) OpenOnDiskReadOnlyReplica(shardID uint64,
+	replicaID uint64,
+	create sm.CreateOnDiskStateMachineFunc) (*ReadOnlyReplica, error) {
+	cf := func(cfg config.Config, done <-chan struct{}) rsm.IManagedStateMachine {
+		ds := create(shardID, replicaID)
+		return rsm.NewNativeSM(cfg, rsm.NewOnDiskStateMachine(ds), done)
+	}
+	return nh.openReadOnlyReplica(shardID, replicaID, cf, pb.OnDiskStateMachine)
+}
+
+func (nh *NodeHost) openReadOnlyReplica(shardID uint64, replicaID uint64,
+	create func(config.Config, <-chan struct{}) rsm.IManagedStateMachine,
+	smType pb.StateMachineType) (*ReadOnlyReplica, error) {
+	n, ok := nh.getShard(shardID)
+	if ok && n.replicaID == replicaID {
+		return nil, ErrShardNotStopped
+	}
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	if _, ok := nh.mu.shards.Load(shardID); ok {
+		return nil, ErrShardNotStopped
+	}
+	if nh.engine.nodeLoaded(shardID, replicaID) {
+		return nil, ErrShardNotStopped
+	}
+	if _, ok := nh.mu.readOnly.Load(shardID); ok {
+		return nil, ErrReadOnlyReplicaOpen
+	}
+	bi, err := nh.mu.logdb.GetBootstrapInfo(shardID, replicaID)
+	if errors.Is(err, raftio.ErrNoBootstrapInfo) {
+		return nil, ErrShardNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bi.Type != smType {
+		return nil, ErrInvalidShardSettings
+	}
+	did := nh.nhConfig.GetDeploymentID()
+	deleted, err := fileutil.IsDirMarkedAsDeleted(
+		nh.env.GetSnapshotDir(did, shardID, replicaID), nh.fs)
+	if err != nil {
+		return nil, err
+	}
+	if deleted {
+		return nil, ErrReplicaRemoved
+	}
+	r := &ReadOnlyReplica{
+		nh:        nh,
+		shardID:   shardID,
+		replicaID: replicaID,
+		stopc:     make(chan struct{}),
+	}
+	if err := r.open(create); err != nil {
+		return nil, err
+	}
+	nh.mu.readOnly.Store(shardID, r)
+	return r, nil
+}
+
+func (r *ReadOnlyReplica) open(
+	create func(config.Config, <-chan struct{}) rsm.IManagedStateMachine) error {
+	nh := r.nh
+	did := nh.nhConfig.GetDeploymentID()
+	getSnapshotDir := func(cid uint64, nid uint64) string {
+		return nh.env.GetSnapshotDir(did, cid, nid)
+	}
+	node := &readOnlyNode{
+		shardID:   r.shardID,
+		replicaID: r.replicaID,
+		stopc:     r.stopc,
+	}
+	logReader := logdb.NewLogReader(r.shardID, r.replicaID, nh.mu.logdb)
+	logReader.SetCompactor(node)
+	ss := newSnapshotter(r.shardID, r.replicaID,
+		getSnapshotDir, nh.mu.logdb, logReader, nh.fs, 0)
+	snapshot, err := ss.GetSnapshotFromLogDB()
+	if err != nil && !ss.IsNoSnapshotError(err) {
+		return err
+	}
+	if !pb.IsEmptySnapshot(snapshot) {
+		if err := logReader.ApplySnapshot(snapshot); err != nil {
+			return err
+		}
+	}
+	rs, err := nh.mu.logdb.ReadRaftState(r.shardID, r.replicaID, snapshot.Index)
+	if err != nil && !errors.Is(err, raftio.ErrNoSavedLog) {
+		return err
+	}
+	if err == nil {
+		logReader.SetState(rs.State)
+		logReader.SetRange(rs.FirstIndex, rs.EntryCount)
+	}
+	cfg := config.Config{ShardID: r.shardID, ReplicaID: r.replicaID}
+	r.sm = rsm.NewStateMachine(create(cfg, r.stopc), ss, cfg, node, nh.fs)
+	if err := r.replay(logReader, snapshot.Index, rs.State.Commit); err != nil {
+		return firstError(err, r.sm.Close())
+	}
+	return nil
+}
+
+// replay recovers the state machine from the latest snapshot and applies all
+// committed entries in the local Raft log.
+func (r *ReadOnlyReplica) replay(logReader *logdb.LogReader,
+	ssIndex uint64, commit uint64) error {
+	if r.sm.OnDiskStateMachine() {
+		if _, err := r.sm.OpenOnDiskStateMachine(); err != nil {
+			return err
+		}
+	}
+	if _, err := r.sm.Recover(rsm.Task{Recover: true, Initial: true}); err != nil {
+		return err
+	}
+	r.index = ssIndex
+	batch := make([]rsm.Task, 0, 1)
+	for r.index < commit {
+		entries, err := logReader.Entries(r.index+1, commit+1, tailReadBatchSize)
+		if err != nil {
+			return err
+		}
+		r.sm.TaskQ().Add(rsm.Task{Entries: entries})
+		if _, err := r.sm.Handle(batch); err != nil {
+			return err
+		}
+		r.index = entries[len(entries)-1].Index
+	}
+	plog.Infof("%s opened as a read-only replica, index %d",
+		dn(r.shardID, r.replicaID), r.index)
+	return nil
+}
+
+// Lookup queries the state machine of the read-only replica.
+func (r *ReadOnlyReplica) Lookup(query interface{}) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, ErrClosed
+	}
+	return r.sm.Lookup(query)
+}
+
+// Index returns the index of the last committed entry applied to the state
+// machine of the read-only replica.
+func (r *ReadOnlyReplica) Index() uint64 {
+	return r.index
+}
+
+// Close closes the state machine of the read-only replica, the replica can be
+// started again on its NodeHost once closed.
+func (r *ReadOnlyReplica) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.stopc)
+	r.nh.mu.readOnly.Delete(r.shardID)
+	return r.sm.Close()
+}
+
+// readOnlyNode is the rsm.INode and the pb.ICompactor used by read-only
+// replicas, there is no raft node to be notified when entries are applied and
+// the local Raft log is never compacted.
+type readOnlyNode struct {
+	shardID   uint64
+	replicaID uint64
+	stopc     chan struct{}
+}
+
+var _ rsm.INode = (*readOnlyNode)(nil)
+var _ pb.ICompactor = (*readOnlyNode)(nil)
+
+func (n *readOnlyNode) Compact(uint64) error { return nil }
+
+func (n *readOnlyNode) StepReady() {}
+
+func (n *readOnlyNode) RestoreRemotes(pb.Snapshot) error { return nil }
+
+func (n *readOnlyNode) ApplyUpdate(pb.Entry, sm.Result, bool, bool, bool) {}
+
+func (n *readOnlyNode) ApplyConfigChange(pb.ConfigChange,
+	uint64, bool, error) error {
+	return nil
+}
+
+func (n *readOnlyNode) EntriesApplied([]pb.Entry) {}
+
+func (n *readOnlyNode) ReplicaID() uint64 { return n.replicaID }
+
+func (n *readOnlyNode) ShardID() uint64 { return n.shardID }
+
+func (n *readOnlyNode) ShouldStop() <-chan struct{} { return n.stopc }
@@ -0,0 +1,138 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+)
+
+func TestReadOnlyReplicaMatchesLiveShard(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := make(map[uint64]string)
+		for i := range nhs {
+			members[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		startCloneTestShard(t, nhs, 1, []uint64{1, 2, 3}, members)
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(nhs[0]))
+		defer cancel()
+		propose := func(cmd string) {
+			if _, err := nhs[0].SyncPropose(ctx,
+				nhs[0].GetNoOPSession(1), []byte(cmd)); err != nil {
+				t.Fatalf("failed to propose %v", err)
+			}
+		}
+		propose("a=1")
+		if _, err := nhs[1].SyncRequestSnapshot(ctx,
+			1, SnapshotOption{}); err != nil {
+			t.Fatalf("failed to request snapshot %v", err)
+		}
+		propose("b=2")
+		propose("a=3")
+		if _, err := nhs[1].OpenReadOnlyReplica(1,
+			2, newCloneTestSM); !errors.Is(err, ErrShardNotStopped) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		var index uint64
+		for i := 0; ; i++ {
+			index = getTestLastApplied(nhs[0])
+			if getTestLastApplied(nhs[1]) == index &&
+				getTestLastApplied(nhs[2]) == index {
+				break
+			}
+			if i > 200 {
+				t.Fatalf("entries not applied")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		want := make(map[string]string)
+		for _, key := range []string{"a", "b"} {
+			want[key] = readCloneTestValue(t, nhs[0], 1, key)
+		}
+		nh := nhs[1]
+		if err := nh.StopShard(1); err != nil {
+			t.Fatalf("failed to stop shard %v", err)
+		}
+		var r *ReadOnlyReplica
+		for i := 0; ; i++ {
+			var err error
+			r, err = nh.OpenReadOnlyReplica(1, 2, newCloneTestSM)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, ErrShardNotStopped) || i > 200 {
+				t.Fatalf("failed to open read-only replica %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if r.Index() != index {
+			t.Errorf("index %d, want %d", r.Index(), index)
+		}
+		for key, value := range want {
+			v, err := r.Lookup(key)
+			if err != nil {
+				t.Fatalf("lookup failed %v", err)
+			}
+			if v.(string) != value {
+				t.Errorf("key %s, value %s, want %s", key, v, value)
+			}
+		}
+		if _, err := nh.OpenReadOnlyReplica(1,
+			2, newCloneTestSM); !errors.Is(err, ErrReadOnlyReplicaOpen) {
+			t.Errorf("unexpected error %v", err)
+		}
+		if err := nh.RemoveData(1, 2); !errors.Is(err, ErrReadOnlyReplicaOpen) {
+			t.Errorf("unexpected error %v", err)
+		}
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    2,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
+		}
+		if err := nh.StartReplica(nil,
+			false, newCloneTestSM, rc); !errors.Is(err, ErrReadOnlyReplicaOpen) {
+			t.Errorf("unexpected error %v", err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("failed to close %v", err)
+		}
+		if _, err := r.Lookup("a"); !errors.Is(err, ErrClosed) {
+			t.Errorf("unexpected error %v", err)
+		}
+		// the replica can be started again once the read-only replica is closed
+		if err := nh.StartReplica(nil, false, newCloneTestSM, rc); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+		waitForTestLastApplied(t, nh, index)
+		v, err := nh.StaleRead(1, "a")
+		if err != nil {
+			t.Fatalf("stale read failed %v", err)
+		}
+		if v.(string) != want["a"] {
+			t.Errorf("unexpected value %s", v)
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
@@ -0,0 +1,175 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	"github.com/lni/dragonboat/v4/raftio"
+)
+
+// restartInReadOnlyMode closes the specified NodeHost and creates it again in
+// the read-only mode.
+func restartInReadOnlyMode(t *testing.T, nhs []*NodeHost,
+	idx int, listener *testSysEventListener) *NodeHost {
+	nhc := nhs[idx].NodeHostConfig()
+	nhs[idx].Close()
+	nhc.ReadOnlyMode = true
+	nhc.SystemEventListener = listener
+	nh, err := NewNodeHost(nhc)
+	if err != nil {
+		t.Fatalf("failed to create nodehost %v", err)
+	}
+	nhs[idx] = nh
+	return nh
+}
+
+func getReadOnlyTestConfig(replicaID uint64) config.Config {
+	return config.Config{
+		ShardID:      1,
+		ReplicaID:    replicaID,
+		ElectionRTT:  10,
+		HeartbeatRTT: 1,
+		CheckQuorum:  true,
+		IsNonVoting:  true,
+	}
+}
+
+func TestReadOnlyNodeHostOnlyServesReads(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		nh := restartInReadOnlyMode(t, nhs, 2, &testSysEventListener{})
+		members := map[uint64]string{
+			1: memtransport.Address(1),
+			2: memtransport.Address(2),
+		}
+		startCloneTestShard(t, nhs[:2], 1, []uint64{1, 2}, members)
+		rc := getReadOnlyTestConfig(3)
+		rc.IsNonVoting = false
+		if err := nh.StartReplica(nil,
+			true, newCloneTestSM, rc); !errors.Is(err, ErrReadOnlyNodeHost) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(nh))
+		defer cancel()
+		if err := nhs[0].SyncRequestAddNonVoting(ctx,
+			1, 3, memtransport.Address(3), 0); err != nil {
+			t.Fatalf("failed to add non-voting %v", err)
+		}
+		if err := nh.StartReplica(nil,
+			true, newCloneTestSM, getReadOnlyTestConfig(3)); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+		if _, err := nhs[0].SyncPropose(ctx,
+			nhs[0].GetNoOPSession(1), []byte("a=1")); err != nil {
+			t.Fatalf("failed to propose %v", err)
+		}
+		waitForTestLastApplied(t, nh, getTestLastApplied(nhs[0]))
+		v, err := nh.StaleRead(1, "a")
+		if err != nil {
+			t.Fatalf("stale read failed %v", err)
+		}
+		if v.(string) != "1" {
+			t.Errorf("unexpected value %s", v)
+		}
+		if v := readCloneTestValue(t, nh, 1, "a"); v != "1" {
+			t.Errorf("unexpected value %s", v)
+		}
+		if _, err := nh.SyncPropose(ctx,
+			nh.GetNoOPSession(1), []byte("b=2")); !errors.Is(err, ErrReadOnlyNodeHost) {
+			t.Errorf("unexpected error %v", err)
+		}
+		if _, err := nh.SyncGetSession(ctx, 1); !errors.Is(err, ErrReadOnlyNodeHost) {
+			t.Errorf("unexpected error %v", err)
+		}
+		if !nh.GetNodeHostInfo(DefaultNodeHostInfoOption).ReadOnlyMode {
+			t.Errorf("read-only mode not reported")
+		}
+		if nhs[0].GetNodeHostInfo(DefaultNodeHostInfoOption).ReadOnlyMode {
+			t.Errorf("unexpected read-only mode")
+		}
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
+
+func TestReadOnlyNodeHostNeverIncrementsTerm(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := make(map[uint64]string)
+		for i := range nhs {
+			members[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		startCloneTestShard(t, nhs, 1, []uint64{1, 2, 3}, members)
+		listener := &testSysEventListener{}
+		nh := restartInReadOnlyMode(t, nhs, 2, listener)
+		// replica 3 is still a voting member according to its Raft log
+		if err := nh.StartReplica(nil,
+			false, newCloneTestSM, getReadOnlyTestConfig(3)); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+		waitForLeaderToBeElected(t, nh, 1)
+		dump, err := nh.DumpRaftState(context.Background(), 1)
+		if err != nil {
+			t.Fatalf("failed to dump raft state %v", err)
+		}
+		term := dump.Term
+		network.Partition([]string{memtransport.Address(1),
+			memtransport.Address(2)}, []string{memtransport.Address(3)})
+		timeout := time.Duration(10*nh.NodeHostConfig().RTTMillisecond) *
+			time.Millisecond
+		for i := 0; i < 50; i++ {
+			time.Sleep(timeout)
+			dump, err := nh.DumpRaftState(context.Background(), 1)
+			if err != nil {
+				t.Fatalf("failed to dump raft state %v", err)
+			}
+			if dump.Term != term || dump.Role != "Follower" {
+				t.Fatalf("term %d, role %s, want term %d follower",
+					dump.Term, dump.Role, term)
+			}
+		}
+		// campaigns might also have been suppressed in earlier terms while the
+		// leader was being elected
+		var events []raftio.CampaignSuppressedInfo
+		for _, e := range listener.getCampaignSuppressedEvents() {
+			if e.Term >= term {
+				events = append(events, e)
+			}
+		}
+		if len(events) != 1 {
+			t.Fatalf("unexpected events %v", events)
+		}
+		if events[0].ShardID != 1 || events[0].ReplicaID != 3 ||
+			events[0].Term != term {
+			t.Errorf("unexpected event %+v", events[0])
+		}
+		network.Heal()
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(nh))
+		defer cancel()
+		if _, err := nhs[0].SyncPropose(ctx,
+			nhs[0].GetNoOPSession(1), []byte("a=1")); err != nil {
+			t.Fatalf("failed to propose %v", err)
+		}
+		waitForTestLastApplied(t, nh, getTestLastApplied(nhs[0]))
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
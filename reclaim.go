@@ -0,0 +1,237 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+)
+
+// ReclaimStage is a stage of the disk space reclaim operation performed by
+// SyncReclaimDiskSpace.
+type ReclaimStage uint8
+
+const (
+	// ReclaimSnapshot is the stage in which a snapshot is created.
+	ReclaimSnapshot ReclaimStage = iota
+	// ReclaimLogCompaction is the stage in which Raft log entries covered by the
+	// snapshot are removed from the LogDB.
+	ReclaimLogCompaction
+	// ReclaimStorageCompaction is the stage in which the LogDB reclaims the
+	// storage space used by removed entries.
+	ReclaimStorageCompaction
+)
+
+var reclaimStageNames = [...]string{
+	ReclaimSnapshot:          "Snapshot",
+	ReclaimLogCompaction:     "LogCompaction",
+	ReclaimStorageCompaction: "StorageCompaction",
+}
+
+func (s ReclaimStage) String() string {
+	if s > ReclaimStorageCompaction {
+		return fmt.Sprintf("ReclaimStage(%d)", int(s))
+	}
+	return reclaimStageNames[s]
+}
+
+// ReclaimError is the error returned by SyncReclaimDiskSpace when a stage of
+// the reclaim operation failed. Stage is the failed stage, Err is the reason
+// of the failure.
+type ReclaimError struct {
+	Err     error
+	ShardID uint64
+	Stage   ReclaimStage
+}
+
+func (e *ReclaimError) Error() string {
+	return fmt.Sprintf("shard %d failed to reclaim disk space in %s stage: %v",
+		e.ShardID, e.Stage, e.Err)
+}
+
+// Unwrap returns the reason of the failure.
+func (e *ReclaimError) Unwrap() error {
+	return e.Err
+}
+
+// ReclaimOption is the option type used by SyncReclaimDiskSpace.
+type ReclaimOption struct {
+	// SnapshotLag is the maximum number of entries the latest snapshot can be
+	// behind the last applied index for it to be used without creating a new
+	// snapshot. The default value 0 means that a new snapshot is created unless
+	// the latest snapshot is at the last applied index.
+	SnapshotLag uint64
+}
+
+// ReclaimResult is the summary of a disk space reclaim operation.
+type ReclaimResult struct {
+	// SnapshotIndex is the index of the snapshot up to which Raft log entries
+	// have been removed.
+	SnapshotIndex uint64
+	// SnapshotCreated indicates whether a new snapshot has been created.
+	SnapshotCreated bool
+	// EntriesRemoved is the number of Raft log entries removed from the LogDB.
+	EntriesRemoved uint64
+	// BytesReclaimed is the approximate number of bytes reclaimed, it is
+	// measured as the size change of the NodeHost data directories which are
+	// shared by the LogDB and snapshots of all shards on the NodeHost. Obsolete
+	// files asynchronously removed by the LogDB after SyncReclaimDiskSpace
+	// returns are not counted.
+	BytesReclaimed uint64
+}
+
+// SyncReclaimDiskSpace reclaims the disk space used by the local replica of the
+// specified shard. It creates a new snapshot unless the latest snapshot is
+// recent enough as specified by opt, removes all Raft log entries covered by
+// the snapshot regardless of the compaction overhead setting and waits for the
+// LogDB to reclaim the storage space used by removed entries.
+//
+// A *ReclaimError indicating the failed stage is returned on failure. Invoking
+// SyncReclaimDiskSpace again resumes the operation, stages already completed
+// by the failed invocation are not repeated.
+//
+// The input context object must have deadline set.
+func (nh *NodeHost) SyncReclaimDiskSpace(ctx context.Context,
+	shardID uint64, opt ReclaimOption) (_ ReclaimResult, err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation:  "SyncReclaimDiskSpace",
+		ShardID:    shardID,
+		Parameters: auditParams{"Option": opt},
+	}, time.Now(), &err)
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ReclaimResult{}, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return ReclaimResult{}, ErrShardNotFound
+	}
+	fail := func(s ReclaimStage, err error) (ReclaimResult, error) {
+		return ReclaimResult{}, &ReclaimError{Err: err, ShardID: shardID, Stage: s}
+	}
+	before, err := nh.getDataDirSize()
+	if err != nil {
+		return ReclaimResult{}, err
+	}
+	first, _ := n.logReader.GetRange()
+	var result ReclaimResult
+	result.SnapshotIndex, result.SnapshotCreated, err = nh.reclaimSnapshot(ctx, n, opt)
+	if err != nil {
+		return fail(ReclaimSnapshot, err)
+	}
+	atomic.StoreUint64(&n.reclaimIndex, result.SnapshotIndex)
+	if err := nh.reclaimLog(ctx, n, result.SnapshotIndex); err != nil {
+		return fail(ReclaimLogCompaction, err)
+	}
+	op, err := n.compactLogDB(result.SnapshotIndex)
+	if err != nil {
+		return fail(ReclaimStorageCompaction, err)
+	}
+	select {
+	case <-op.ResultC():
+	case <-ctx.Done():
+		return fail(ReclaimStorageCompaction, getContextError(ctx))
+	}
+	atomic.StoreUint64(&n.reclaimIndex, 0)
+	if after, _ := n.logReader.GetRange(); after > first {
+		result.EntriesRemoved = after - first
+	}
+	sz, err := nh.getDataDirSize()
+	if err != nil {
+		return ReclaimResult{}, err
+	}
+	if before > sz {
+		result.BytesReclaimed = before - sz
+	}
+	return result, nil
+}
+
+// reclaimSnapshot returns the index of the snapshot to be used by the reclaim
+// operation, a new snapshot is created when required.
+func (nh *NodeHost) reclaimSnapshot(ctx context.Context,
+	n *node, opt ReclaimOption) (uint64, bool, error) {
+	index := n.ss.getIndex()
+	if index > 0 && atomic.LoadUint64(&n.reclaimIndex) == index {
+		// resumed from a failed reclaim operation
+		return index, false, nil
+	}
+	if index > 0 && n.sm.GetLastApplied() <= index+opt.SnapshotLag {
+		return index, false, nil
+	}
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	rs, err := nh.requestSnapshot(n.shardID, SnapshotOption{
+		OverrideCompactionOverhead: true,
+	}, timeout)
+	if err != nil {
+		return 0, false, err
+	}
+	v, err := getRequestState(ctx, rs)
+	if err != nil {
+		return 0, false, err
+	}
+	return v.Value, true, nil
+}
+
+// reclaimLog removes entries up to the specified index from the LogDB, it
+// returns once they have been removed.
+func (nh *NodeHost) reclaimLog(ctx context.Context, n *node, index uint64) error {
+	compacted := func() bool {
+		first, _ := n.logReader.GetRange()
+		return first > index
+	}
+	if compacted() {
+		return nil
+	}
+	if atomic.LoadUint64(&n.compactTo) < index {
+		n.compactLog(rsm.SSRequest{OverrideCompaction: true}, index)
+		nh.engine.setStepReady(n.shardID)
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !compacted() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return getContextError(ctx)
+		case <-n.stopC:
+			return ErrShardClosed
+		}
+	}
+	return nil
+}
+
+// getDataDirSize returns the total size of the NodeHost data directories.
+func (nh *NodeHost) getDataDirSize() (uint64, error) {
+	dir, walDir := nh.env.GetLogDBDirs(nh.nhConfig.GetDeploymentID())
+	sz, err := fileutil.DirSize(dir, nh.fs)
+	if err != nil {
+		return 0, err
+	}
+	if walDir != dir {
+		walSz, err := fileutil.DirSize(walDir, nh.fs)
+		if err != nil {
+			return 0, err
+		}
+		sz += walSz
+	}
+	return sz, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+func TestReclaimStageString(t *testing.T) {
+	if ReclaimLogCompaction.String() != "LogCompaction" {
+		t.Errorf("unexpected name %s", ReclaimLogCompaction)
+	}
+	if ReclaimStage(100).String() != "ReclaimStage(100)" {
+		t.Errorf("unexpected name %s", ReclaimStage(100))
+	}
+	err := &ReclaimError{Err: ErrTimeout, ShardID: 1, Stage: ReclaimSnapshot}
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("failed to unwrap the reason")
+	}
+}
+
+func proposeLargeTestData(t *testing.T, nh *NodeHost, count int, sz int) {
+	session := nh.GetNoOPSession(1)
+	for i := 0; i < count; i++ {
+		cmd := make([]byte, sz)
+		rand.Read(cmd)
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+		_, err := nh.SyncPropose(ctx, session, cmd)
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to make proposal, %v", err)
+		}
+	}
+}
+
+func reclaimTestDiskSpace(t *testing.T,
+	nh *NodeHost, opt ReclaimOption) ReclaimResult {
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+	defer cancel()
+	result, err := nh.SyncReclaimDiskSpace(ctx, 1, opt)
+	if err != nil {
+		t.Fatalf("failed to reclaim disk space %v", err)
+	}
+	return result
+}
+
+func TestSyncReclaimDiskSpace(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.SnapshotEntries = 0
+			c.CompactionOverhead = 100000
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			proposeLargeTestData(t, nh, 1024, 32*1024)
+			before, err := nh.getDataDirSize()
+			if err != nil {
+				t.Fatalf("failed to get dir size %v", err)
+			}
+			result := reclaimTestDiskSpace(t, nh, ReclaimOption{})
+			if !result.SnapshotCreated || result.SnapshotIndex == 0 {
+				t.Errorf("snapshot not created, %+v", result)
+			}
+			if result.EntriesRemoved < 1024 {
+				t.Errorf("unexpected entries removed, %+v", result)
+			}
+			n, ok := nh.getShard(1)
+			if !ok {
+				t.Fatalf("failed to get node")
+			}
+			first, _ := n.logReader.GetRange()
+			if first != result.SnapshotIndex+1 {
+				t.Errorf("first index %d, snapshot index %d", first, result.SnapshotIndex)
+			}
+			// obsolete files can be asynchronously removed by the LogDB
+			for i := 0; i < 500; i++ {
+				after, err := nh.getDataDirSize()
+				if err != nil {
+					t.Fatalf("failed to get dir size %v", err)
+				}
+				if after < before/2 {
+					break
+				}
+				if i == 499 {
+					t.Fatalf("dir size %d, was %d, %+v", after, before, result)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			// the latest snapshot is recent enough to be reused
+			proposeTestData(t, nh, "small", 2)
+			result = reclaimTestDiskSpace(t, nh, ReclaimOption{SnapshotLag: 10})
+			if result.SnapshotCreated || result.EntriesRemoved != 0 {
+				t.Errorf("unexpected result %+v", result)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestSyncReclaimDiskSpaceResumesFailedOperation(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.SnapshotEntries = 0
+			c.CompactionOverhead = 100000
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			proposeTestData(t, nh, "reclaim", 10)
+			n, ok := nh.getShard(1)
+			if !ok {
+				t.Fatalf("failed to get node")
+			}
+			// the snapshot stage completed, the following stage failed
+			index := requestTestSnapshot(t, nh)
+			atomic.StoreUint64(&n.reclaimIndex, index)
+			proposeTestData(t, nh, "more", 10)
+			result := reclaimTestDiskSpace(t, nh, ReclaimOption{})
+			if result.SnapshotCreated || result.SnapshotIndex != index {
+				t.Errorf("unexpected result %+v", result)
+			}
+			if first, _ := n.logReader.GetRange(); first != index+1 {
+				t.Errorf("first index %d, snapshot index %d", first, index)
+			}
+			if atomic.LoadUint64(&n.reclaimIndex) != 0 {
+				t.Errorf("reclaim index not reset")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestSyncReclaimDiskSpaceReportsFailedStage(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			proposeTestData(t, nh, "reclaim", 10)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := nh.SyncReclaimDiskSpace(ctx, 1, ReclaimOption{})
+			var re *ReclaimError
+			if !errors.As(err, &re) || re.Stage != ReclaimSnapshot ||
+				!errors.Is(err, ErrDeadlineNotSet) {
+				t.Errorf("unexpected error %v", err)
+			}
+			if _, err := nh.SyncReclaimDiskSpace(ctx, 2,
+				ReclaimOption{}); !errors.Is(err, ErrShardNotFound) {
+				t.Errorf("unexpected error %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
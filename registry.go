@@ -14,10 +14,135 @@
 
 package dragonboat
 
+import (
+	"github.com/lni/dragonboat/v4/internal/registry"
+)
+
 // INodeHostRegistry provides APIs for querying data shared between NodeHost
 // instances via gossip.
 type INodeHostRegistry interface {
 	NumOfShards() int
 	GetMeta(nhID string) ([]byte, bool)
+	GetNodeHostTags(nhID string) (map[string]string, bool)
+	// IsNodeHostDraining returns a boolean value indicating whether the
+	// specified NodeHost instance is advertised as draining, see
+	// NodeHost.SetDrainState for details. The second boolean value is false
+	// when the NodeHost instance is unknown.
+	IsNodeHostDraining(nhID string) (bool, bool)
 	GetShardInfo(shardID uint64) (ShardView, bool)
+	// GetShardPlacement returns where replicas of the specified shard are
+	// located and which one is the leader. ListShards returns placements of
+	// known shards matching the specified filter in ascending shard ID order,
+	// shards can be listed in pages using the StartShardID and Limit fields of
+	// the filter.
+	//
+	// Placements are built from views exchanged between NodeHost instances,
+	// they are eventually consistent and can lag behind leadership and
+	// membership changes.
+	GetShardPlacement(shardID uint64) (ShardPlacement, bool)
+	ListShards(filter ShardFilter) []ShardPlacement
+	// Watch returns a channel for receiving changes of the registry, e.g. to
+	// maintain a routing table of shard leaders without polling. The returned
+	// function stops the watch and closes the channel. Events are delivered on
+	// a best-effort basis, when the channel buffer is full, buffered events are
+	// dropped and replaced by a Resync event after which the watcher should
+	// list the current state again. Only the gossip based registry delivers
+	// events.
+	Watch(buffer int) (<-chan RegistryEvent, func())
+}
+
+// ShardPlacement describes where replicas of a Raft shard are located based
+// on the knowledge of the local NodeHost instance.
+type ShardPlacement = registry.ShardPlacement
+
+// ReplicaPlacement describes where a replica of a Raft shard is located.
+type ReplicaPlacement = registry.ReplicaPlacement
+
+// ReplicaRole is the role of a replica in its Raft shard.
+type ReplicaRole = registry.ReplicaRole
+
+const (
+	// Voter is a regular voting replica.
+	Voter = registry.Voter
+	// NonVoting is a non-voting replica.
+	NonVoting = registry.NonVoting
+	// Witness is a witness replica without the actual log.
+	Witness = registry.Witness
+)
+
+// NodeHostLiveness is the liveness of a NodeHost instance as observed by the
+// local NodeHost instance.
+type NodeHostLiveness = registry.NodeHostLiveness
+
+const (
+	// NodeHostUnknown means the liveness of the NodeHost instance is unknown.
+	NodeHostUnknown = registry.NodeHostUnknown
+	// NodeHostAlive means the NodeHost instance is a live gossip member.
+	NodeHostAlive = registry.NodeHostAlive
+	// NodeHostSuspect means the NodeHost instance failed to respond to the
+	// latest gossip probe.
+	NodeHostSuspect = registry.NodeHostSuspect
+	// NodeHostDead means the NodeHost instance has been declared as failed or
+	// it has left the gossip group.
+	NodeHostDead = registry.NodeHostDead
+)
+
+// RegistryEvent is a change of the registry observed by the local NodeHost
+// instance.
+type RegistryEvent = registry.RegistryEvent
+
+// RegistryEventType is the type of a RegistryEvent.
+type RegistryEventType = registry.RegistryEventType
+
+const (
+	// Resync means that events have been dropped, the watcher should list the
+	// current state of the registry again.
+	Resync = registry.Resync
+	// NodeHostJoined means that a NodeHost instance became known.
+	NodeHostJoined = registry.NodeHostJoined
+	// NodeHostLeft means that a NodeHost instance left or failed.
+	NodeHostLeft = registry.NodeHostLeft
+	// NodeHostAddressChanged means that the RaftAddress of a known NodeHost
+	// instance changed.
+	NodeHostAddressChanged = registry.NodeHostAddressChanged
+	// ShardReplicasChanged means that a shard became known or its known
+	// replica set changed.
+	ShardReplicasChanged = registry.ShardReplicasChanged
+	// ShardLeaderChanged means that the believed leader of a shard changed.
+	ShardLeaderChanged = registry.ShardLeaderChanged
+)
+
+// ShardFilter specifies the shards to be returned by the ListShards method of
+// INodeHostRegistry.
+type ShardFilter = registry.ShardFilter
+
+// GetShardNodeHostsByTags returns replicas of the specified shard running on
+// NodeHost instances with all the specified tags, e.g. to find replicas of a
+// shard located in a certain zone. The returned map is a map of replica IDs to
+// NodeHostID values. It is only applicable when NodeHost instances are
+// addressed by their NodeHostID values.
+func GetShardNodeHostsByTags(r INodeHostRegistry,
+	shardID uint64, tags map[string]string) map[uint64]string {
+	result := make(map[uint64]string)
+	sv, ok := r.GetShardInfo(shardID)
+	if !ok {
+		return result
+	}
+	for replicaID, nhID := range sv.Replicas {
+		nhTags, ok := r.GetNodeHostTags(nhID)
+		if !ok {
+			continue
+		}
+		matched := true
+		for k, v := range tags {
+			if tv, ok := nhTags[k]; !ok || tv != v {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			result[replicaID] = nhID
+		}
+	}
+	return result
 }
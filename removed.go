@@ -0,0 +1,71 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+)
+
+// removedReplicas contains local replicas unloaded after learning that they
+// have been removed from their shards. They are kept in the NodeHostInfo
+// returned by GetNodeHostInfo with the IsRemoved flag set and requests
+// targeting them fail with ErrReplicaRemoved, until they are stopped using
+// StopReplica or StopShard, their data is removed using RemoveData or their
+// shards are started again.
+type removedReplicas struct {
+	mu       sync.Mutex
+	replicas map[uint64]ShardInfo
+}
+
+func (r *removedReplicas) add(info ShardInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.replicas == nil {
+		r.replicas = make(map[uint64]ShardInfo)
+	}
+	info.IsRemoved = true
+	r.replicas[info.ShardID] = info
+}
+
+func (r *removedReplicas) contains(shardID uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.replicas[shardID]
+	return ok
+}
+
+// stop unregisters the removed replica, it returns a boolean value indicating
+// whether such replica was found.
+func (r *removedReplicas) stop(shardID uint64,
+	replicaID uint64, check bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info, ok := r.replicas[shardID]
+	if !ok || (check && info.ReplicaID != replicaID) {
+		return false
+	}
+	delete(r.replicas, shardID)
+	return true
+}
+
+func (r *removedReplicas) getShardInfo() []ShardInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make([]ShardInfo, 0, len(r.replicas))
+	for _, info := range r.replicas {
+		result = append(result, info)
+	}
+	return result
+}
@@ -15,6 +15,8 @@
 package dragonboat
 
 import (
+	"context"
+	crand "crypto/rand"
 	"crypto/sha512"
 	"encoding/binary"
 	"fmt"
@@ -37,13 +39,40 @@ import (
 	sm "github.com/lni/dragonboat/v4/statemachine"
 )
 
+const (
+	// RequestIDLength is the length of request IDs attached to proposals when
+	// config.Config.PropagateRequestIDs is enabled.
+	RequestIDLength = 16
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of the parent context with the specified
+// request ID attached. The request ID is persisted with the entry proposed
+// using the returned context when config.Config.PropagateRequestIDs is
+// enabled, a random request ID is generated for proposals made without one.
+func WithRequestID(ctx context.Context, id [RequestIDLength]byte) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func getRequestID(ctx context.Context) []byte {
+	if id, ok := ctx.Value(requestIDKey{}).([RequestIDLength]byte); ok {
+		return id[:]
+	}
+	id := make([]byte, RequestIDLength)
+	if _, err := crand.Read(id); err != nil {
+		panic(err)
+	}
+	return id
+}
+
 var (
 	defaultGCTick         uint64 = 2
 	pendingProposalShards        = settings.Soft.PendingProposalShards
 )
 
 var (
-	plog = logger.GetLogger("dragonboat")
+	plog = logger.GetStructuredLogger("dragonboat")
 )
 
 var (
@@ -77,8 +106,15 @@ var (
 	ErrCanceled = errors.New("request canceled")
 	// ErrRejected indicates that the request has been rejected.
 	ErrRejected = errors.New("request rejected")
+	// ErrSessionCapacity indicates that the client session registration has
+	// been rejected as the shard already has the maximum number of client
+	// sessions and none of them has been inactive for more than
+	// config.Config.SessionTTLEntries Raft log entries.
+	ErrSessionCapacity = errors.New("too many active client sessions")
 	// ErrAborted indicates that the request has been aborted, usually by user
-	// defined behaviours.
+	// defined behaviours. Chunked proposals are aborted when some of their
+	// chunks are lost, e.g. due to a leader change, see
+	// config.Config.MaxEntryChunkBytes.
 	ErrAborted = errors.New("request aborted")
 	// ErrShardNotReady indicates that the request has been dropped as the
 	// specified raft shard is not ready to handle the request. Unknown leader
@@ -87,6 +123,60 @@ var (
 	ErrShardNotReady = errors.New("request dropped as the shard is not ready")
 	// ErrInvalidTarget indicates that the specified node id invalid.
 	ErrInvalidTarget = errors.New("invalid target node ID")
+	// ErrUnsafeMembershipChange indicates that the requested membership change
+	// has been rejected by the leader as the resulting membership would not
+	// have a quorum of active voting members.
+	ErrUnsafeMembershipChange = errors.New("unsafe membership change")
+	// ErrTooManyWitnesses indicates that the requested membership change has
+	// been rejected by the leader as the resulting membership would have more
+	// witnesses than allowed by config.Config.MaxWitnesses or more witnesses
+	// than regular nodes.
+	ErrTooManyWitnesses = errors.New("too many witnesses")
+	// ErrTooManyNonVotings indicates that the requested membership change has
+	// been rejected by the leader as the resulting membership would have more
+	// non-voting members than allowed by config.Config.MaxNonVotings.
+	ErrTooManyNonVotings = errors.New("too many non-voting members")
+	// ErrReplicaIDReused indicates that the requested membership change has
+	// been rejected as it tries to add a removed replica back to the shard.
+	ErrReplicaIDReused = errors.New("removed replica id reused")
+	// ErrAddressInUse indicates that the requested membership change has been
+	// rejected as the target address is used by another replica of the shard.
+	ErrAddressInUse = errors.New("address used by another replica")
+	// ErrTargetIsNonVoting indicates that the requested leader transfer has
+	// been rejected as the target is a non-voting member.
+	ErrTargetIsNonVoting = errors.New("leader transfer target is non-voting")
+	// ErrTargetIsWitness indicates that the requested leader transfer has been
+	// rejected as the target is a witness.
+	ErrTargetIsWitness = errors.New("leader transfer target is witness")
+	// ErrTargetNotMember indicates that the requested leader transfer has been
+	// rejected as the target is not a member of the shard.
+	ErrTargetNotMember = errors.New("leader transfer target not a member")
+	// ErrTargetLagging indicates that the requested leader transfer has been
+	// rejected as the target has not caught up with the leader and the
+	// NoCatchupWait option is set.
+	ErrTargetLagging = errors.New("leader transfer target is lagging")
+	// ErrDiskFull indicates that the proposal has been rejected as the free
+	// disk space of the NodeHost fell below the critical threshold specified
+	// in config.NodeHostConfig.DiskMonitor.
+	ErrDiskFull = errors.New("proposal rejected as disk is full")
+	// ErrReadOnlyNodeHost indicates that the request has been rejected as the
+	// NodeHost is in the read-only mode, see
+	// config.NodeHostConfig.ReadOnlyMode for details.
+	ErrReadOnlyNodeHost = errors.New("NodeHost is in read-only mode")
+	// ErrCollocatedWitness indicates that the request for adding a witness has
+	// been rejected as the witness would be collocated with another replica of
+	// the shard, see config.NodeHostConfig.RejectCollocatedWitness for
+	// details.
+	ErrCollocatedWitness = errors.New("witness collocated with another replica")
+	// ErrRateLimited indicates that the proposal has been rejected as the
+	// tenant of the shard exceeded its quota, see NodeHost.SetTenantQuota for
+	// details.
+	ErrRateLimited = errors.New("proposal rejected as tenant quota exceeded")
+	// ErrMembershipTooLarge indicates that the requested membership change or
+	// the initial members of the shard have been rejected as the membership
+	// would have more than 256 replicas or replica addresses longer than 512
+	// bytes.
+	ErrMembershipTooLarge = errors.New("membership too large")
 )
 
 // IsTempError returns a boolean value indicating whether the specified error
@@ -99,7 +189,11 @@ func IsTempError(err error) bool {
 		errors.Is(err, ErrShardNotReady) ||
 		errors.Is(err, ErrTimeout) ||
 		errors.Is(err, ErrClosed) ||
-		errors.Is(err, ErrAborted)
+		errors.Is(err, ErrAborted) ||
+		errors.Is(err, ErrTargetLagging) ||
+		errors.Is(err, ErrDiskFull) ||
+		errors.Is(err, ErrSessionCapacity) ||
+		errors.Is(err, ErrRateLimited)
 }
 
 // LogRange defines the range [FirstIndex, lastIndex) of the raft log.
@@ -122,8 +216,13 @@ type RequestResult struct {
 	result         sm.Result
 	entries        []pb.Entry
 	logRange       LogRange
+	snapshot       SnapshotResult
 	snapshotResult bool
 	logQueryResult bool
+	inactive       []uint64
+	rejectErr      error
+	// index is the index of the applied proposal
+	index uint64
 }
 
 // RequestOutOfRange returns a boolean value indicating whether the request
@@ -169,11 +268,42 @@ func (rr *RequestResult) Aborted() bool {
 // client ID has already been registered. When requesting a client session to
 // be unregistered, Rejected means the specified client session is not found
 // on the server side. For a membership change request, it means the request
-// is out of order and thus not applied.
+// is out of order, unsafe or invalid and thus not applied.
 func (rr *RequestResult) Rejected() bool {
 	return rr.code == requestRejected
 }
 
+// InactiveReplicas returns the inactive voting replicas that caused the
+// membership change request to be rejected as unsafe. nil is returned when
+// the request is not rejected for safety reasons.
+func (rr *RequestResult) InactiveReplicas() []uint64 {
+	return rr.inactive
+}
+
+// LimitExceeded returns a boolean value indicating whether the membership
+// change request is rejected as the resulting membership would exceed the
+// limits on the number of witnesses or non-voting members or on the size of
+// the membership.
+func (rr *RequestResult) LimitExceeded() bool {
+	return errors.Is(rr.rejectErr, ErrTooManyWitnesses) ||
+		errors.Is(rr.rejectErr, ErrTooManyNonVotings) ||
+		errors.Is(rr.rejectErr, ErrMembershipTooLarge)
+}
+
+// ReplicaIDReused returns a boolean value indicating whether the membership
+// change request is rejected as it tries to add a removed replica back to the
+// shard.
+func (rr *RequestResult) ReplicaIDReused() bool {
+	return errors.Is(rr.rejectErr, ErrReplicaIDReused)
+}
+
+// AddressInUse returns a boolean value indicating whether the membership
+// change request is rejected as the target address is used by another replica
+// of the shard.
+func (rr *RequestResult) AddressInUse() bool {
+	return errors.Is(rr.rejectErr, ErrAddressInUse)
+}
+
 // Dropped returns a boolean flag indicating whether the request has been
 // dropped as the leader is unavailable or not ready yet. Such dropped requests
 // can usually be retried once the leader is ready.
@@ -191,6 +321,16 @@ func (rr *RequestResult) SnapshotIndex() uint64 {
 	return rr.result.Value
 }
 
+// GetSnapshotResult returns the metadata of the generated snapshot when the
+// RequestResult is from a snapshot related request. Invoking this method on
+// RequestResult instances not related to snapshots will cause panic.
+func (rr *RequestResult) GetSnapshotResult() SnapshotResult {
+	if !rr.snapshotResult {
+		plog.Panicf("not a snapshot request result")
+	}
+	return rr.snapshot
+}
+
 // RaftLogs returns the raft log query result.
 func (rr *RequestResult) RaftLogs() ([]pb.Entry, LogRange) {
 	if !rr.logQueryResult {
@@ -290,6 +430,14 @@ func (o *SysOpState) ResultC() <-chan struct{} {
 	return o.completedC
 }
 
+// EntryMeta describes the Raft log entry of a committed proposal.
+type EntryMeta struct {
+	// Index is the index of the entry.
+	Index uint64
+	// Term is the term of the entry.
+	Term uint64
+}
+
 // RequestState is the object used to provide request result to users.
 type RequestState struct {
 	key            uint64
@@ -303,6 +451,7 @@ type RequestState struct {
 	readyToRelease ready
 	aggrC          chan RequestResult
 	committedC     chan RequestResult
+	commitC        chan EntryMeta
 	// CompletedC is a channel for delivering request result to users.
 	//
 	// Deprecated: CompletedC has been deprecated. Use ResultC() or AppliedC()
@@ -310,10 +459,26 @@ type RequestState struct {
 	CompletedC   chan RequestResult
 	node         *node
 	pool         *sync.Pool
+	span         *requestSpan
+	requestID    []byte
+	started      time.Time
+	enqueued     time.Time
+	size         uint64
+	index        uint64
+	term         uint64
+	stage        PendingRequestStage
+	stats        *requestCounters
+	abandoned    ready
 	notifyCommit bool
 	testErr      chan struct{}
 }
 
+// RequestID returns the ID of the client request attached to the proposed
+// entry, it is nil when config.Config.PropagateRequestIDs is not enabled.
+func (r *RequestState) RequestID() []byte {
+	return r.requestID
+}
+
 // AppliedC returns a channel of RequestResult for delivering request result.
 // The returned channel reports the final outcomes of proposals and config
 // changes, the return value can be of one of the Completed(), Dropped(),
@@ -325,6 +490,33 @@ func (r *RequestState) AppliedC() chan RequestResult {
 	return r.CompletedC
 }
 
+// CommittedC returns a channel of EntryMeta for delivering the index and term
+// of the proposed entry once it is committed by Raft, it is only available for
+// proposals. The committed entry is never lost, regardless of any later leader
+// change, and it is applied by all replicas with the proposal rejected by none
+// of them. The AppliedC() or ResultC() channel delivers the final outcome of
+// the proposal afterwards, the outcome of a proposal notified as committed is
+// always one of the Completed(), Timeout() or Terminated() values, the latter
+// two are returned when the local replica doesn't apply the entry before the
+// deadline or it is stopped. CommittedC is available regardless of the
+// config.NodeHostConfig.NotifyCommit setting.
+//
+// For proposals made with NO-OP client sessions, the notification is delivered
+// as soon as the entry is known to be committed by the local replica. For
+// proposals made with registered client sessions, the state machine can still
+// reject the entry when applying it, e.g. when the session has been evicted,
+// the notification is thus only delivered once the local replica applied the
+// entry, just before the final outcome. In both cases, the client session must
+// only be updated using client.ProposalCompleted() once the proposal is
+// reported as completed by AppliedC() or ResultC(), never on the committed
+// notification.
+//
+// Nothing is delivered from the returned channel when the proposal fails
+// before its entry is committed.
+func (r *RequestState) CommittedC() <-chan EntryMeta {
+	return r.commitC
+}
+
 // ResultC returns a channel of RequestResult for delivering request results to
 // users. When NotifyCommit is not enabled, the behaviour of the returned
 // channel is the same as the one returned by the AppliedC() method. When
@@ -424,6 +616,16 @@ func (r *RequestState) committed() {
 	}
 }
 
+// entryCommitted delivers the index and term of the committed entry to the
+// CommittedC() channel.
+func (r *RequestState) entryCommitted() {
+	select {
+	case r.commitC <- EntryMeta{Index: r.index, Term: r.term}:
+	default:
+		plog.Panicf("RequestState.commitC is full")
+	}
+}
+
 func (r *RequestState) timeout() {
 	r.notify(RequestResult{code: requestTimeout})
 }
@@ -437,6 +639,11 @@ func (r *RequestState) dropped() {
 }
 
 func (r *RequestState) notify(result RequestResult) {
+	if r.span != nil {
+		r.span.end(result.code.String())
+		r.span = nil
+	}
+	r.stats.done(result, r.abandoned.ready())
 	select {
 	case r.CompletedC <- result:
 		r.readyToRelease.set()
@@ -461,6 +668,13 @@ func (r *RequestState) Release() {
 		r.seriesID = 0
 		r.clientID = 0
 		r.respondedTo = 0
+		r.requestID = nil
+		r.size = 0
+		r.index = 0
+		r.term = 0
+		r.stage = RequestQueued
+		r.stats = nil
+		r.abandoned.clear()
 		r.node = nil
 		r.readyToRead.clear()
 		r.readyToRelease.clear()
@@ -476,6 +690,9 @@ func (r *RequestState) reuse(notifyCommit bool) {
 	if len(r.CompletedC) > 0 || r.CompletedC == nil {
 		r.CompletedC = make(chan RequestResult, 1)
 	}
+	if len(r.commitC) > 0 || r.commitC == nil {
+		r.commitC = make(chan EntryMeta, 1)
+	}
 	if notifyCommit {
 		if len(r.committedC) > 0 || r.committedC == nil {
 			r.committedC = make(chan RequestResult, 1)
@@ -483,6 +700,7 @@ func (r *RequestState) reuse(notifyCommit bool) {
 	} else {
 		r.committedC = nil
 	}
+	r.span = nil
 }
 
 func (r *RequestState) mustBeReadyForLocalRead() {
@@ -503,6 +721,9 @@ type proposalShard struct {
 	pending        map[uint64]*RequestState
 	pool           *sync.Pool
 	cfg            config.Config
+	metrics        *shardMetrics
+	tracer         *nodeTracer
+	stats          *requestCounters
 	stopped        bool
 	notifyCommit   bool
 	expireNotified uint64
@@ -536,8 +757,20 @@ type pendingReadIndex struct {
 	mu       sync.Mutex
 	batches  map[pb.SystemCtx]readBatch
 	requests *readIndexQueue
+	metrics  *shardMetrics
+	tracer   *nodeTracer
+	stats    *requestCounters
+	rounds   *readIndexStats
 	stopped  bool
 	pool     *sync.Pool
+	// holders are the recycled request slices of completed ReadIndex batches.
+	holders [][]*RequestState
+	// inflight is the system ctx of the ReadIndex round in flight when read
+	// batching is enabled, reads received after it was requested are held back
+	// until it completes or batchDelay has passed since it was requested.
+	inflight   pb.SystemCtx
+	requested  time.Time
+	batchDelay time.Duration
 	logicalClock
 }
 
@@ -550,7 +783,9 @@ type pendingConfigChange struct {
 	mu           sync.Mutex
 	pending      *RequestState
 	confChangeC  chan<- configChangeRequest
+	stats        *requestCounters
 	notifyCommit bool
+	enterJoint   bool
 	logicalClock
 }
 
@@ -558,6 +793,7 @@ type pendingSnapshot struct {
 	mu        sync.Mutex
 	pending   *RequestState
 	snapshotC chan<- rsm.SSRequest
+	stats     *requestCounters
 	logicalClock
 }
 
@@ -592,6 +828,35 @@ func (l *pendingLeaderTransfer) get() (uint64, bool) {
 	return 0, false
 }
 
+type pendingRaftStateDump struct {
+	dumpC chan chan *RaftStateDump
+}
+
+func newPendingRaftStateDump() pendingRaftStateDump {
+	return pendingRaftStateDump{
+		dumpC: make(chan chan *RaftStateDump, 1),
+	}
+}
+
+func (d *pendingRaftStateDump) request() (chan *RaftStateDump, error) {
+	c := make(chan *RaftStateDump, 1)
+	select {
+	case d.dumpC <- c:
+	default:
+		return nil, ErrSystemBusy
+	}
+	return c, nil
+}
+
+func (d *pendingRaftStateDump) get() (chan *RaftStateDump, bool) {
+	select {
+	case c := <-d.dumpC:
+		return c, true
+	default:
+	}
+	return nil, false
+}
+
 func newPendingSnapshot(snapshotC chan<- rsm.SSRequest) pendingSnapshot {
 	return pendingSnapshot{
 		logicalClock: newLogicalClock(),
@@ -604,6 +869,12 @@ func (p *pendingSnapshot) notify(r RequestResult) {
 	p.pending.notify(r)
 }
 
+func (p *pendingSnapshot) requested() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pending != nil
+}
+
 func (p *pendingSnapshot) close() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -615,7 +886,8 @@ func (p *pendingSnapshot) close() {
 }
 
 func (p *pendingSnapshot) request(st rsm.SSReqType,
-	path string, override bool, overhead uint64, index uint64,
+	path string, sink rsm.IExportSink, override bool, overhead uint64,
+	index uint64, leaderTerm uint64, prioritized bool,
 	timeoutTick uint64) (*RequestState, error) {
 	if timeoutTick == 0 {
 		return nil, ErrTimeoutTooSmall
@@ -631,14 +903,19 @@ func (p *pendingSnapshot) request(st rsm.SSReqType,
 	ssreq := rsm.SSRequest{
 		Type:               st,
 		Path:               path,
+		Sink:               sink,
 		Key:                random.LockGuardedRand.Uint64(),
 		OverrideCompaction: override,
 		CompactionOverhead: overhead,
 		CompactionIndex:    index,
+		LeaderTerm:         leaderTerm,
+		Prioritized:        prioritized,
 	}
 	req := &RequestState{
 		key:          ssreq.Key,
 		deadline:     p.getTick() + timeoutTick,
+		enqueued:     time.Now(),
+		stats:        p.stats,
 		CompletedC:   make(chan RequestResult, 1),
 		notifyCommit: false,
 	}
@@ -672,8 +949,19 @@ func (p *pendingSnapshot) gc() {
 	}
 }
 
+// reject completes the specified pending snapshot request as rejected with
+// err as the reason.
+func (p *pendingSnapshot) reject(key uint64, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending != nil && p.pending.key == key {
+		p.notify(RequestResult{code: requestRejected, rejectErr: err})
+		p.pending = nil
+	}
+}
+
 func (p *pendingSnapshot) apply(key uint64,
-	ignored bool, aborted bool, index uint64) {
+	ignored bool, aborted bool, ss SnapshotResult) {
 	if ignored && aborted {
 		plog.Panicf("ignored && aborted")
 	}
@@ -690,7 +978,8 @@ func (p *pendingSnapshot) apply(key uint64,
 			r.code = requestAborted
 		} else {
 			r.code = requestCompleted
-			r.result.Value = index
+			r.result.Value = ss.Index
+			r.snapshot = ss
 		}
 		p.notify(r)
 		p.pending = nil
@@ -719,8 +1008,35 @@ func (p *pendingConfigChange) close() {
 	}
 }
 
+func (p *pendingConfigChange) requested() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pending != nil
+}
+
 func (p *pendingConfigChange) request(cc pb.ConfigChange,
 	timeoutTick uint64) (*RequestState, error) {
+	return p.submit(cc, timeoutTick, false)
+}
+
+// requestEnterJoint requests the specified EnterJoint config change, the
+// request is completed once the EnterJoint config change is applied rather
+// than when the joint config is left.
+func (p *pendingConfigChange) requestEnterJoint(cc pb.ConfigChange,
+	timeoutTick uint64) (*RequestState, error) {
+	return p.submit(cc, timeoutTick, true)
+}
+
+// isEnterJoint returns a boolean value indicating whether the pending request
+// identified by key is completed once the EnterJoint config change is applied.
+func (p *pendingConfigChange) isEnterJoint(key uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pending != nil && p.pending.key == key && p.enterJoint
+}
+
+func (p *pendingConfigChange) submit(cc pb.ConfigChange,
+	timeoutTick uint64, enterJoint bool) (*RequestState, error) {
 	if timeoutTick == 0 {
 		return nil, ErrTimeoutTooSmall
 	}
@@ -740,6 +1056,9 @@ func (p *pendingConfigChange) request(cc pb.ConfigChange,
 	req := &RequestState{
 		key:          ccreq.key,
 		deadline:     p.getTick() + timeoutTick,
+		enqueued:     time.Now(),
+		size:         uint64(len(data)),
+		stats:        p.stats,
 		CompletedC:   make(chan RequestResult, 1),
 		notifyCommit: p.notifyCommit,
 	}
@@ -749,6 +1068,7 @@ func (p *pendingConfigChange) request(cc pb.ConfigChange,
 	select {
 	case p.confChangeC <- ccreq:
 		p.pending = req
+		p.enterJoint = enterJoint
 		return req, nil
 	default:
 	}
@@ -795,6 +1115,18 @@ func (p *pendingConfigChange) dropped(key uint64) {
 	}
 }
 
+func (p *pendingConfigChange) timedOut(key uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending == nil {
+		return
+	}
+	if p.pending.key == key {
+		p.pending.timeout()
+		p.pending = nil
+	}
+}
+
 func (p *pendingConfigChange) apply(key uint64, rejected bool) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -813,6 +1145,34 @@ func (p *pendingConfigChange) apply(key uint64, rejected bool) {
 	}
 }
 
+// rejectUnsafe notifies the pending config change that it has been rejected
+// as the listed voting replicas are inactive.
+func (p *pendingConfigChange) rejectUnsafe(key uint64, inactive []uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending == nil {
+		return
+	}
+	if p.pending.key == key {
+		p.pending.notify(RequestResult{code: requestRejected, inactive: inactive})
+		p.pending = nil
+	}
+}
+
+// rejectWithError notifies the pending config change that it has been rejected
+// for the reason described by the specified error.
+func (p *pendingConfigChange) rejectWithError(key uint64, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending == nil {
+		return
+	}
+	if p.pending.key == key {
+		p.pending.notify(RequestResult{code: requestRejected, rejectErr: err})
+		p.pending = nil
+	}
+}
+
 func newPendingReadIndex(pool *sync.Pool, r *readIndexQueue) pendingReadIndex {
 	return pendingReadIndex{
 		batches:      make(map[pb.SystemCtx]readBatch),
@@ -822,6 +1182,19 @@ func newPendingReadIndex(pool *sync.Pool, r *readIndexQueue) pendingReadIndex {
 	}
 }
 
+func (p *pendingReadIndex) count() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	total := uint64(0)
+	if p.requests != nil {
+		total += p.requests.pendingSize()
+	}
+	for _, rb := range p.batches {
+		total += uint64(len(rb.requests))
+	}
+	return total
+}
+
 func (p *pendingReadIndex) close() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -842,7 +1215,8 @@ func (p *pendingReadIndex) close() {
 	}
 }
 
-func (p *pendingReadIndex) read(timeoutTick uint64) (*RequestState, error) {
+func (p *pendingReadIndex) read(ctx context.Context,
+	timeoutTick uint64) (*RequestState, error) {
 	if timeoutTick == 0 {
 		return nil, ErrTimeoutTooSmall
 	}
@@ -850,12 +1224,21 @@ func (p *pendingReadIndex) read(timeoutTick uint64) (*RequestState, error) {
 	req.reuse(false)
 	req.notifyCommit = false
 	req.deadline = p.getTick() + timeoutTick
+	req.started = p.metrics.now()
+	req.enqueued = time.Now()
+	req.stage = RequestQueued
+	req.index = 0
+	req.size = 0
+	req.stats = p.stats
+	req.span = p.tracer.startRead(ctx)
 
 	ok, closed := p.requests.add(req)
 	if closed {
+		req.span.end(ErrShardClosed.Error())
 		return nil, ErrShardClosed
 	}
 	if !ok {
+		req.span.end(ErrSystemBusy.Error())
 		return nil, ErrSystemBusy
 	}
 	return req, nil
@@ -880,6 +1263,31 @@ func (p *pendingReadIndex) nextCtx() pb.SystemCtx {
 	return p.genCtx()
 }
 
+// canRequest returns a boolean value indicating whether a new ReadIndex round
+// can be requested for the received reads.
+func (p *pendingReadIndex) canRequest() bool {
+	if p.batchDelay == 0 {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inflight.Low == 0 || time.Since(p.requested) >= p.batchDelay
+}
+
+// isInflight returns a boolean value indicating whether there is a ReadIndex
+// round in flight.
+func (p *pendingReadIndex) isInflight() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inflight.Low != 0
+}
+
+func (p *pendingReadIndex) completed(sys pb.SystemCtx) {
+	if p.inflight == sys {
+		p.inflight = pb.SystemCtx{}
+	}
+}
+
 func (p *pendingReadIndex) addReady(reads []pb.ReadyToRead) {
 	if len(reads) == 0 {
 		return
@@ -887,9 +1295,15 @@ func (p *pendingReadIndex) addReady(reads []pb.ReadyToRead) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	for _, v := range reads {
+		p.completed(v.SystemCtx)
 		if rb, ok := p.batches[v.SystemCtx]; ok {
 			rb.index = v.Index
 			p.batches[v.SystemCtx] = rb
+			for _, req := range rb.requests {
+				if req != nil {
+					req.span.indexEvent(confirmedEventName, v.Index)
+				}
+			}
 		}
 	}
 }
@@ -903,12 +1317,42 @@ func (p *pendingReadIndex) add(sys pb.SystemCtx, reqs []*RequestState) {
 	if _, ok := p.batches[sys]; ok {
 		plog.Panicf("same system ctx added again %v", sys)
 	} else {
-		rs := make([]*RequestState, len(reqs))
-		copy(rs, reqs)
+		rs := append(p.getHolder(), reqs...)
+		for _, req := range rs {
+			req.span.event(requestedEventName)
+		}
 		p.batches[sys] = readBatch{
 			requests: rs,
 		}
+		p.rounds.requested(len(rs))
+		if p.batchDelay > 0 {
+			p.inflight = sys
+			p.requested = time.Now()
+		}
+	}
+}
+
+// maxReadBatchHolders is the maximum number of recycled request slices kept
+// by each pendingReadIndex instance.
+const maxReadBatchHolders = 16
+
+func (p *pendingReadIndex) getHolder() []*RequestState {
+	if n := len(p.holders); n > 0 {
+		rs := p.holders[n-1]
+		p.holders = p.holders[:n-1]
+		return rs
+	}
+	return nil
+}
+
+func (p *pendingReadIndex) releaseHolder(rs []*RequestState) {
+	if len(p.holders) >= maxReadBatchHolders {
+		return
+	}
+	for i := range rs {
+		rs[i] = nil
 	}
+	p.holders = append(p.holders, rs[:0])
 }
 
 func (p *pendingReadIndex) dropped(system pb.SystemCtx) {
@@ -917,6 +1361,7 @@ func (p *pendingReadIndex) dropped(system pb.SystemCtx) {
 	if p.stopped {
 		return
 	}
+	p.completed(system)
 	if rb, ok := p.batches[system]; ok {
 		for _, req := range rb.requests {
 			if req != nil {
@@ -924,6 +1369,7 @@ func (p *pendingReadIndex) dropped(system pb.SystemCtx) {
 			}
 		}
 		delete(p.batches, system)
+		p.releaseHolder(rb.requests)
 	}
 }
 
@@ -942,6 +1388,7 @@ func (p *pendingReadIndex) applied(applied uint64) {
 					if req.deadline > now {
 						req.readyToRead.set()
 						v.code = requestCompleted
+						p.metrics.readIndexDone(req.started)
 					} else {
 						v.code = requestTimeout
 					}
@@ -949,6 +1396,7 @@ func (p *pendingReadIndex) applied(applied uint64) {
 				}
 			}
 			delete(p.batches, sys)
+			p.releaseHolder(rb.requests)
 		}
 	}
 	if now-p.lastGcTime < p.gcTick {
@@ -981,7 +1429,9 @@ func (p *pendingReadIndex) gc(now uint64) {
 				}
 			}
 			if empty {
+				p.completed(sys)
 				delete(p.batches, sys)
+				p.releaseHolder(rb.requests)
 			}
 		}
 	}
@@ -1013,11 +1463,22 @@ func newPendingProposal(cfg config.Config,
 	return p
 }
 
-func (p *pendingProposal) propose(session *client.Session,
-	cmd []byte, timeoutTick uint64) (*RequestState, error) {
+func (p *pendingProposal) propose(ctx context.Context,
+	session *client.Session, cmd []byte,
+	timeoutTick uint64) (*RequestState, error) {
+	key := p.nextKey(session.ClientID)
+	pp := p.shards[key%p.ps]
+	return pp.propose(ctx, session, cmd, key, timeoutTick)
+}
+
+// proposeEncoded proposes the already encoded entry Cmd of a chunked or fenced
+// proposal.
+func (p *pendingProposal) proposeEncoded(ctx context.Context,
+	session *client.Session, encoded []byte,
+	timeoutTick uint64) (*RequestState, error) {
 	key := p.nextKey(session.ClientID)
 	pp := p.shards[key%p.ps]
-	return pp.propose(session, cmd, key, timeoutTick)
+	return pp.proposeEncoded(ctx, session, encoded, len(encoded), key, timeoutTick)
 }
 
 func (p *pendingProposal) close() {
@@ -1026,6 +1487,39 @@ func (p *pendingProposal) close() {
 	}
 }
 
+func (p *pendingProposal) count() uint64 {
+	total := uint64(0)
+	for _, pp := range p.shards {
+		pp.mu.Lock()
+		total += uint64(len(pp.pending))
+		pp.mu.Unlock()
+	}
+	return total
+}
+
+func (p *pendingProposal) setMetrics(m *shardMetrics) {
+	for _, pp := range p.shards {
+		pp.metrics = m
+	}
+}
+
+func (p *pendingProposal) setErrorStats(c *requestCounters) {
+	for _, pp := range p.shards {
+		pp.stats = c
+	}
+}
+
+func (p *pendingProposal) setTracer(t *nodeTracer) {
+	for _, pp := range p.shards {
+		pp.tracer = t
+	}
+}
+
+func (p *pendingProposal) traceEvent(name string, e pb.Entry) {
+	pp := p.shards[e.Key%p.ps]
+	pp.traceEvent(name, e)
+}
+
 func (p *pendingProposal) committed(clientID uint64,
 	seriesID uint64, key uint64) {
 	pp := p.shards[key%p.ps]
@@ -1038,6 +1532,12 @@ func (p *pendingProposal) dropped(clientID uint64,
 	pp.dropped(clientID, seriesID, key)
 }
 
+func (p *pendingProposal) timedOut(clientID uint64,
+	seriesID uint64, key uint64) {
+	pp := p.shards[key%p.ps]
+	pp.timedOut(clientID, seriesID, key)
+}
+
 func (p *pendingProposal) applied(clientID uint64,
 	seriesID uint64, key uint64, result sm.Result, rejected bool) {
 	pp := p.shards[key%p.ps]
@@ -1074,7 +1574,7 @@ func newPendingProposalShard(cfg config.Config,
 	return p
 }
 
-func (p *proposalShard) propose(session *client.Session,
+func (p *proposalShard) propose(ctx context.Context, session *client.Session,
 	cmd []byte, key uint64, timeoutTick uint64) (*RequestState, error) {
 	if timeoutTick == 0 {
 		return nil, ErrTimeoutTooSmall
@@ -1082,17 +1582,32 @@ func (p *proposalShard) propose(session *client.Session,
 	if rsm.GetMaxBlockSize(p.cfg.EntryCompressionType) < uint64(len(cmd)) {
 		return nil, ErrPayloadTooBig
 	}
+	var encoded []byte
+	if len(cmd) > 0 {
+		encoded = preparePayload(p.cfg.EntryCompressionType, cmd)
+	}
+	return p.proposeEncoded(ctx, session, encoded, len(cmd), key, timeoutTick)
+}
+
+// proposeEncoded proposes the encoded entry Cmd, sz is the size of the payload
+// before encoding.
+func (p *proposalShard) proposeEncoded(ctx context.Context,
+	session *client.Session, encoded []byte, sz int,
+	key uint64, timeoutTick uint64) (*RequestState, error) {
+	if timeoutTick == 0 {
+		return nil, ErrTimeoutTooSmall
+	}
 	entry := pb.Entry{
 		Key:         key,
 		ClientID:    session.ClientID,
 		SeriesID:    session.SeriesID,
 		RespondedTo: session.RespondedTo,
 	}
-	if len(cmd) == 0 {
+	if len(encoded) == 0 {
 		entry.Type = pb.ApplicationEntry
 	} else {
 		entry.Type = pb.EncodedEntry
-		entry.Cmd = preparePayload(p.cfg.EntryCompressionType, cmd)
+		entry.Cmd = encoded
 	}
 	req := p.pool.Get().(*RequestState)
 	req.reuse(p.notifyCommit)
@@ -1101,6 +1616,16 @@ func (p *proposalShard) propose(session *client.Session,
 	req.key = entry.Key
 	req.deadline = p.getTick() + timeoutTick
 	req.notifyCommit = p.notifyCommit
+	req.enqueued = time.Now()
+	req.size = uint64(sz)
+	req.stage = RequestQueued
+	req.index = 0
+	req.stats = p.stats
+	req.span = p.tracer.startProposal(ctx, session)
+	if p.cfg.PropagateRequestIDs {
+		entry.RequestID = getRequestID(ctx)
+		req.requestID = entry.RequestID
+	}
 
 	p.mu.Lock()
 	p.pending[entry.Key] = req
@@ -1113,6 +1638,7 @@ func (p *proposalShard) propose(session *client.Session,
 		p.mu.Lock()
 		delete(p.pending, entry.Key)
 		p.mu.Unlock()
+		req.span.end(ErrShardClosed.Error())
 		return nil, ErrShardClosed
 	}
 	if !added {
@@ -1121,8 +1647,10 @@ func (p *proposalShard) propose(session *client.Session,
 		p.mu.Unlock()
 		plog.Debugf("%s dropped proposal, overloaded",
 			dn(p.cfg.ShardID, p.cfg.ReplicaID))
+		req.span.end(ErrSystemBusy.Error())
 		return nil, ErrSystemBusy
 	}
+	p.metrics.proposalAdded()
 	return req, nil
 }
 
@@ -1136,6 +1664,7 @@ func (p *proposalShard) close() {
 	for _, rec := range p.pending {
 		rec.terminated()
 	}
+	p.metrics.proposalDone(requestTerminated, len(p.pending))
 }
 
 func (p *proposalShard) getProposal(clientID uint64,
@@ -1167,6 +1696,16 @@ func (p *proposalShard) takeProposal(clientID uint64,
 	return nil
 }
 
+func (p *proposalShard) traceEvent(name string, e pb.Entry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ps, ok := p.pending[e.Key]; ok {
+		if ps.clientID == e.ClientID && ps.seriesID == e.SeriesID {
+			ps.span.entryEvent(name, e)
+		}
+	}
+}
+
 func (p *proposalShard) committed(clientID uint64, seriesID uint64, key uint64) {
 	if ps := p.borrowProposal(clientID, seriesID, key, p.getTick()); ps != nil {
 		ps.committed()
@@ -1176,6 +1715,14 @@ func (p *proposalShard) committed(clientID uint64, seriesID uint64, key uint64)
 func (p *proposalShard) dropped(clientID uint64, seriesID uint64, key uint64) {
 	if ps := p.getProposal(clientID, seriesID, key, p.getTick()); ps != nil {
 		ps.dropped()
+		p.metrics.proposalDone(requestDropped, 1)
+	}
+}
+
+func (p *proposalShard) timedOut(clientID uint64, seriesID uint64, key uint64) {
+	if ps := p.getProposal(clientID, seriesID, key, p.getTick()); ps != nil {
+		ps.timeout()
+		p.metrics.proposalDone(requestTimeout, 1)
 	}
 }
 
@@ -1188,8 +1735,31 @@ func (p *proposalShard) applied(clientID uint64,
 	} else {
 		code = requestCompleted
 	}
+	var rejectErr error
+	if rejected && seriesID == client.SeriesIDForRegister &&
+		rsm.IsSessionCapacityResult(result) {
+		rejectErr = ErrSessionCapacity
+		result = sm.Result{}
+	} else if rejected && rsm.IsIncompleteChunksResult(result) {
+		rejectErr = ErrAborted
+		result = sm.Result{}
+	} else if rejected && rsm.IsFenceExpiredResult(result) {
+		rejectErr = ErrFenceExpired
+		result = sm.Result{}
+	}
 	if ps := p.getProposal(clientID, seriesID, key, now); ps != nil {
-		ps.notify(RequestResult{code: code, result: result})
+		// proposals made with registered client sessions are only notified as
+		// committed once known to be not rejected by the state machine
+		if code == requestCompleted && seriesID != client.NoOPSeriesID {
+			ps.entryCommitted()
+		}
+		ps.notify(RequestResult{
+			code:      code,
+			result:    result,
+			rejectErr: rejectErr,
+			index:     ps.index,
+		})
+		p.metrics.proposalDone(code, 1)
 	}
 	if now != p.expireNotified {
 		p.gcAt(now)
@@ -1211,12 +1781,15 @@ func (p *proposalShard) gcAt(now uint64) {
 		return
 	}
 	p.lastGcTime = now
+	expired := 0
 	for key, rec := range p.pending {
 		if rec.deadline < now {
 			rec.timeout()
 			delete(p.pending, key)
+			expired++
 		}
 	}
+	p.metrics.proposalDone(requestTimeout, expired)
 }
 
 func preparePayload(ct config.CompressionType, cmd []byte) []byte {
@@ -15,12 +15,16 @@
 package dragonboat
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"reflect"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/cockroachdb/errors"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/lni/dragonboat/v4/client"
@@ -51,6 +55,19 @@ func TestIsTempError(t *testing.T) {
 		{ErrShardNotReady, true},
 		{ErrInvalidTarget, false},
 		{ErrInvalidRange, false},
+		{ErrUnsafeMembershipChange, false},
+		{ErrTooManyWitnesses, false},
+		{ErrTooManyNonVotings, false},
+		{ErrReplicaIDReused, false},
+		{ErrAddressInUse, false},
+		{ErrTargetIsNonVoting, false},
+		{ErrTargetIsWitness, false},
+		{ErrTargetNotMember, false},
+		{ErrTargetLagging, true},
+		{ErrDiskFull, true},
+		{ErrSessionCapacity, true},
+		{ErrReadOnlyNodeHost, false},
+		{ErrRateLimited, true},
 	}
 	for idx, tt := range tests {
 		if tmp := IsTempError(tt.err); tmp != tt.temp {
@@ -338,7 +355,7 @@ func TestPendingSnapshotCanBeCreatedAndClosed(t *testing.T) {
 func TestPendingSnapshotCanBeRequested(t *testing.T) {
 	snapshotC := make(chan rsm.SSRequest, 1)
 	ps := newPendingSnapshot(snapshotC)
-	ss, err := ps.request(rsm.UserRequested, "", false, 0, 0, 10)
+	ss, err := ps.request(rsm.UserRequested, "", nil, false, 0, 0, 0, false, 10)
 	if err != nil {
 		t.Fatalf("failed to request snapshot")
 	}
@@ -362,10 +379,10 @@ func TestPendingSnapshotCanBeRequested(t *testing.T) {
 func TestPendingSnapshotCanReturnBusy(t *testing.T) {
 	snapshotC := make(chan rsm.SSRequest, 1)
 	ps := newPendingSnapshot(snapshotC)
-	if _, err := ps.request(rsm.UserRequested, "", false, 0, 0, 10); err != nil {
+	if _, err := ps.request(rsm.UserRequested, "", nil, false, 0, 0, 0, false, 10); err != nil {
 		t.Errorf("failed to request snapshot")
 	}
-	if _, err := ps.request(rsm.UserRequested, "", false, 0, 0, 10); err != ErrSystemBusy {
+	if _, err := ps.request(rsm.UserRequested, "", nil, false, 0, 0, 0, false, 10); err != ErrSystemBusy {
 		t.Errorf("failed to return ErrSystemBusy")
 	}
 }
@@ -373,7 +390,7 @@ func TestPendingSnapshotCanReturnBusy(t *testing.T) {
 func TestTooSmallSnapshotTimeoutIsRejected(t *testing.T) {
 	snapshotC := make(chan<- rsm.SSRequest, 1)
 	ps := newPendingSnapshot(snapshotC)
-	ss, err := ps.request(rsm.UserRequested, "", false, 0, 0, 0)
+	ss, err := ps.request(rsm.UserRequested, "", nil, false, 0, 0, 0, false, 0)
 	if err != ErrTimeoutTooSmall {
 		t.Errorf("request not rejected")
 	}
@@ -385,7 +402,7 @@ func TestTooSmallSnapshotTimeoutIsRejected(t *testing.T) {
 func TestMultiplePendingSnapshotIsNotAllowed(t *testing.T) {
 	snapshotC := make(chan<- rsm.SSRequest, 1)
 	ps := newPendingSnapshot(snapshotC)
-	ss, err := ps.request(rsm.UserRequested, "", false, 0, 0, 100)
+	ss, err := ps.request(rsm.UserRequested, "", nil, false, 0, 0, 0, false, 100)
 	if err != nil {
 		t.Fatalf("failed to request snapshot")
 	}
@@ -393,7 +410,7 @@ func TestMultiplePendingSnapshotIsNotAllowed(t *testing.T) {
 		t.Fatalf("nil ss returned")
 		return
 	}
-	ss, err = ps.request(rsm.UserRequested, "", false, 0, 0, 100)
+	ss, err = ps.request(rsm.UserRequested, "", nil, false, 0, 0, 0, false, 100)
 	if err != ErrSystemBusy {
 		t.Errorf("request not rejected")
 	}
@@ -405,7 +422,7 @@ func TestMultiplePendingSnapshotIsNotAllowed(t *testing.T) {
 func TestPendingSnapshotCanBeGCed(t *testing.T) {
 	snapshotC := make(chan rsm.SSRequest, 1)
 	ps := newPendingSnapshot(snapshotC)
-	ss, err := ps.request(rsm.UserRequested, "", false, 0, 0, 20)
+	ss, err := ps.request(rsm.UserRequested, "", nil, false, 0, 0, 0, false, 20)
 	if err != nil {
 		t.Fatalf("failed to request snapshot")
 	}
@@ -440,7 +457,7 @@ func TestPendingSnapshotCanBeGCed(t *testing.T) {
 func TestPendingSnapshotCanBeApplied(t *testing.T) {
 	snapshotC := make(chan rsm.SSRequest, 1)
 	ps := newPendingSnapshot(snapshotC)
-	ss, err := ps.request(rsm.UserRequested, "", false, 0, 0, 100)
+	ss, err := ps.request(rsm.UserRequested, "", nil, false, 0, 0, 0, false, 100)
 	if err != nil {
 		t.Fatalf("failed to request snapshot")
 	}
@@ -448,7 +465,7 @@ func TestPendingSnapshotCanBeApplied(t *testing.T) {
 		t.Fatalf("nil ss returned")
 		return
 	}
-	ps.apply(ss.key, false, false, 123)
+	ps.apply(ss.key, false, false, SnapshotResult{Index: 123})
 	select {
 	case v := <-ss.ResultC():
 		if v.SnapshotIndex() != 123 {
@@ -465,7 +482,7 @@ func TestPendingSnapshotCanBeApplied(t *testing.T) {
 func TestPendingSnapshotCanBeIgnored(t *testing.T) {
 	snapshotC := make(chan rsm.SSRequest, 1)
 	ps := newPendingSnapshot(snapshotC)
-	ss, err := ps.request(rsm.UserRequested, "", false, 0, 0, 100)
+	ss, err := ps.request(rsm.UserRequested, "", nil, false, 0, 0, 0, false, 100)
 	if err != nil {
 		t.Fatalf("failed to request snapshot")
 	}
@@ -473,7 +490,7 @@ func TestPendingSnapshotCanBeIgnored(t *testing.T) {
 		t.Fatalf("nil ss returned")
 		return
 	}
-	ps.apply(ss.key, true, false, 123)
+	ps.apply(ss.key, true, false, SnapshotResult{Index: 123})
 	select {
 	case v := <-ss.ResultC():
 		if v.SnapshotIndex() != 0 {
@@ -490,7 +507,7 @@ func TestPendingSnapshotCanBeIgnored(t *testing.T) {
 func TestPendingSnapshotIsIdentifiedByTheKey(t *testing.T) {
 	snapshotC := make(chan rsm.SSRequest, 1)
 	ps := newPendingSnapshot(snapshotC)
-	ss, err := ps.request(rsm.UserRequested, "", false, 0, 0, 100)
+	ss, err := ps.request(rsm.UserRequested, "", nil, false, 0, 0, 0, false, 100)
 	if err != nil {
 		t.Fatalf("failed to request snapshot")
 		return
@@ -502,7 +519,7 @@ func TestPendingSnapshotIsIdentifiedByTheKey(t *testing.T) {
 	if ps.pending == nil {
 		t.Fatalf("pending not set")
 	}
-	ps.apply(ss.key+1, false, false, 123)
+	ps.apply(ss.key+1, false, false, SnapshotResult{Index: 123})
 	if ps.pending == nil {
 		t.Errorf("pending unexpectedly cleared")
 	}
@@ -517,7 +534,7 @@ func TestSnapshotCanNotBeRequestedAfterClose(t *testing.T) {
 	snapshotC := make(chan rsm.SSRequest, 1)
 	ps := newPendingSnapshot(snapshotC)
 	ps.close()
-	ss, err := ps.request(rsm.UserRequested, "", false, 0, 0, 100)
+	ss, err := ps.request(rsm.UserRequested, "", nil, false, 0, 0, 0, false, 100)
 	if err != ErrShardClosed {
 		t.Errorf("not report as closed")
 	}
@@ -529,7 +546,7 @@ func TestSnapshotCanNotBeRequestedAfterClose(t *testing.T) {
 func TestCompactionOverheadDetailsIsRecorded(t *testing.T) {
 	snapshotC := make(chan rsm.SSRequest, 1)
 	ps := newPendingSnapshot(snapshotC)
-	_, err := ps.request(rsm.UserRequested, "", true, 123, 0, 100)
+	_, err := ps.request(rsm.UserRequested, "", nil, true, 123, 0, 0, false, 100)
 	if err != nil {
 		t.Errorf("failed to request snapshot")
 	}
@@ -887,7 +904,7 @@ func TestLargeProposalCanBeProposed(t *testing.T) {
 
 func TestProposalCanBeProposed(t *testing.T) {
 	pp, c := getPendingProposal(false)
-	rs, err := pp.propose(getBlankTestSession(), []byte("test data"), 100)
+	rs, err := pp.propose(context.Background(), getBlankTestSession(), []byte("test data"), 100)
 	if err != nil {
 		t.Errorf("failed to make proposal, %v", err)
 	}
@@ -914,10 +931,56 @@ func TestProposalCanBeProposed(t *testing.T) {
 	}
 }
 
+func TestRequestIDIsAttachedToProposal(t *testing.T) {
+	id := [RequestIDLength]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	tests := []struct {
+		ctx       context.Context
+		propagate bool
+		generated bool
+	}{
+		{context.Background(), false, false},
+		{WithRequestID(context.Background(), id), false, false},
+		{WithRequestID(context.Background(), id), true, false},
+		{context.Background(), true, true},
+	}
+	for idx, tt := range tests {
+		c := newEntryQueue(5, 0)
+		p := &sync.Pool{New: func() interface{} { return &RequestState{} }}
+		cfg := config.Config{ShardID: 100, ReplicaID: 120,
+			PropagateRequestIDs: tt.propagate}
+		pp := newPendingProposal(cfg, false, p, c)
+		rs, err := pp.propose(tt.ctx, getBlankTestSession(), []byte("test data"), 100)
+		if err != nil {
+			t.Fatalf("%d, failed to make proposal, %v", idx, err)
+		}
+		q := c.get(false)
+		if len(q) != 1 {
+			t.Fatalf("%d, len(c)=%d, want 1", idx, len(q))
+		}
+		requestID := q[0].RequestID
+		switch {
+		case !tt.propagate:
+			if requestID != nil || rs.RequestID() != nil {
+				t.Errorf("%d, unexpected request ID %x", idx, requestID)
+			}
+		case tt.generated:
+			if len(requestID) != RequestIDLength ||
+				!bytes.Equal(requestID, rs.RequestID()) {
+				t.Errorf("%d, unexpected request ID %x", idx, requestID)
+			}
+		default:
+			if !bytes.Equal(requestID, id[:]) || !bytes.Equal(rs.RequestID(), id[:]) {
+				t.Errorf("%d, unexpected request ID %x", idx, requestID)
+			}
+		}
+		pp.close()
+	}
+}
+
 func TestProposeOnClosedPendingProposalReturnError(t *testing.T) {
 	pp, _ := getPendingProposal(false)
 	pp.close()
-	_, err := pp.propose(getBlankTestSession(), []byte("test data"), 100)
+	_, err := pp.propose(context.Background(), getBlankTestSession(), []byte("test data"), 100)
 	if err != ErrShardClosed {
 		t.Errorf("unexpected err %v", err)
 	}
@@ -925,7 +988,7 @@ func TestProposeOnClosedPendingProposalReturnError(t *testing.T) {
 
 func TestProposalCanBeCompleted(t *testing.T) {
 	pp, _ := getPendingProposal(false)
-	rs, err := pp.propose(getBlankTestSession(), []byte("test data"), 100)
+	rs, err := pp.propose(context.Background(), getBlankTestSession(), []byte("test data"), 100)
 	if err != nil {
 		t.Errorf("failed to make proposal, %v", err)
 	}
@@ -954,7 +1017,7 @@ func TestProposalCanBeCompleted(t *testing.T) {
 
 func TestProposalCanBeDropped(t *testing.T) {
 	pp, _ := getPendingProposal(false)
-	rs, err := pp.propose(getBlankTestSession(), []byte("test data"), 100)
+	rs, err := pp.propose(context.Background(), getBlankTestSession(), []byte("test data"), 100)
 	if err != nil {
 		t.Errorf("failed to make proposal, %v", err)
 	}
@@ -974,9 +1037,56 @@ func TestProposalCanBeDropped(t *testing.T) {
 	}
 }
 
+func TestUncommittedProposalCanBeTimedOut(t *testing.T) {
+	pp, _ := getPendingProposal(false)
+	rs, err := pp.propose(context.Background(), getBlankTestSession(), []byte("test data"), 100)
+	if err != nil {
+		t.Errorf("failed to make proposal, %v", err)
+	}
+	pp.timedOut(rs.clientID, rs.seriesID, rs.key)
+	select {
+	case v := <-rs.ResultC():
+		if !v.Timeout() {
+			t.Errorf("not timeout")
+		}
+	default:
+		t.Errorf("not notified")
+	}
+	for _, shard := range pp.shards {
+		if len(shard.pending) > 0 {
+			t.Errorf("pending request not cleared")
+		}
+	}
+}
+
+func TestUncommittedConfigChangeCanBeTimedOut(t *testing.T) {
+	pcc, _ := getPendingConfigChange(false)
+	var cc pb.ConfigChange
+	rs, err := pcc.request(cc, 100)
+	if err != nil {
+		t.Errorf("RequestConfigChange failed: %v", err)
+	}
+	pcc.timedOut(rs.key + 1)
+	if pcc.pending == nil {
+		t.Fatalf("pending rec unexpectedly cleared")
+	}
+	pcc.timedOut(rs.key)
+	select {
+	case v := <-rs.ResultC():
+		if !v.Timeout() {
+			t.Errorf("Timeout() is false")
+		}
+	default:
+		t.Errorf("not timeout")
+	}
+	if pcc.pending != nil {
+		t.Errorf("pending rec not cleared")
+	}
+}
+
 func TestProposalResultCanBeObtainedByCaller(t *testing.T) {
 	pp, _ := getPendingProposal(false)
-	rs, err := pp.propose(getBlankTestSession(), []byte("test data"), 100)
+	rs, err := pp.propose(context.Background(), getBlankTestSession(), []byte("test data"), 100)
 	if err != nil {
 		t.Errorf("failed to make proposal, %v", err)
 	}
@@ -1000,9 +1110,113 @@ func TestProposalResultCanBeObtainedByCaller(t *testing.T) {
 	}
 }
 
+func TestNoOPProposalIsNotifiedWhenCommitted(t *testing.T) {
+	pp, _ := getPendingProposal(false)
+	rs, err := pp.propose(context.Background(), getBlankTestSession(), []byte("test data"), 100)
+	if err != nil {
+		t.Fatalf("failed to make proposal, %v", err)
+	}
+	e := pb.Entry{Key: rs.key, ClientID: rs.clientID,
+		SeriesID: rs.seriesID, Index: 10, Term: 2}
+	pp.setStage(e, RequestAppended)
+	if len(rs.CommittedC()) != 0 {
+		t.Fatalf("notified before committed")
+	}
+	pp.setStage(e, RequestAwaitingApply)
+	// committed again when applied
+	pp.setStage(e, RequestAwaitingApply)
+	select {
+	case m := <-rs.CommittedC():
+		if m.Index != 10 || m.Term != 2 {
+			t.Errorf("unexpected entry meta %+v", m)
+		}
+	default:
+		t.Fatalf("committed notification not delivered")
+	}
+	pp.applied(rs.clientID, rs.seriesID, rs.key, sm.Result{}, false)
+	if len(rs.CommittedC()) != 0 {
+		t.Errorf("committed notified twice")
+	}
+	if v := <-rs.ResultC(); !v.Completed() {
+		t.Errorf("unexpected result %v", v)
+	}
+}
+
+func TestSessionProposalIsNotifiedAsCommittedWhenApplied(t *testing.T) {
+	pp, _ := getPendingProposal(false)
+	for _, rejected := range []bool{true, false} {
+		cs := &client.Session{ClientID: 123, SeriesID: client.SeriesIDFirstProposal}
+		rs, err := pp.propose(context.Background(), cs, []byte("test data"), 100)
+		if err != nil {
+			t.Fatalf("failed to make proposal, %v", err)
+		}
+		e := pb.Entry{Key: rs.key, ClientID: rs.clientID,
+			SeriesID: rs.seriesID, Index: 10, Term: 2}
+		pp.setStage(e, RequestAwaitingApply)
+		if len(rs.CommittedC()) != 0 {
+			t.Fatalf("notified before applied")
+		}
+		pp.applied(rs.clientID, rs.seriesID, rs.key, sm.Result{}, rejected)
+		v := <-rs.ResultC()
+		if rejected {
+			// a committed notification is never followed by a rejection
+			if len(rs.CommittedC()) != 0 || !v.Rejected() {
+				t.Errorf("unexpected result %v", v)
+			}
+			continue
+		}
+		if !v.Completed() {
+			t.Errorf("unexpected result %v", v)
+		}
+		select {
+		case m := <-rs.CommittedC():
+			if m.Index != 10 || m.Term != 2 {
+				t.Errorf("unexpected entry meta %+v", m)
+			}
+		default:
+			t.Errorf("committed notification not delivered")
+		}
+	}
+}
+
+func TestFailedProposalIsNotNotifiedAsCommitted(t *testing.T) {
+	pp, _ := getPendingProposal(false)
+	rs, err := pp.propose(context.Background(), getBlankTestSession(), []byte("test data"), 100)
+	if err != nil {
+		t.Fatalf("failed to make proposal, %v", err)
+	}
+	pp.setStage(pb.Entry{Key: rs.key, Index: 10, Term: 2}, RequestAppended)
+	pp.dropped(rs.clientID, rs.seriesID, rs.key)
+	if v := <-rs.ResultC(); !v.Dropped() {
+		t.Errorf("unexpected result %v", v)
+	}
+	if len(rs.CommittedC()) != 0 {
+		t.Errorf("dropped proposal notified as committed")
+	}
+}
+
+func TestSessionCapacityResultIsReturnedAsErrSessionCapacity(t *testing.T) {
+	pp, _ := getPendingProposal(false)
+	cs := &client.Session{ClientID: 123, SeriesID: client.SeriesIDForRegister}
+	rs, err := pp.propose(context.Background(), cs, nil, 100)
+	if err != nil {
+		t.Fatalf("failed to make proposal, %v", err)
+	}
+	pp.applied(rs.clientID, rs.seriesID, rs.key,
+		rsm.SessionCapacityResult(), true)
+	select {
+	case v := <-rs.ResultC():
+		if err := getRequestError(v); !errors.Is(err, ErrSessionCapacity) {
+			t.Errorf("got %v, want %v", err, ErrSessionCapacity)
+		}
+	default:
+		t.Errorf("expect to get rejected signal")
+	}
+}
+
 func TestClientIDIsCheckedWhenApplyingProposal(t *testing.T) {
 	pp, _ := getPendingProposal(false)
-	rs, err := pp.propose(getBlankTestSession(), []byte("test data"), 100)
+	rs, err := pp.propose(context.Background(), getBlankTestSession(), []byte("test data"), 100)
 	if err != nil {
 		t.Errorf("failed to make proposal, %v", err)
 	}
@@ -1031,7 +1245,7 @@ func TestClientIDIsCheckedWhenApplyingProposal(t *testing.T) {
 
 func TestSeriesIDIsCheckedWhenApplyingProposal(t *testing.T) {
 	pp, _ := getPendingProposal(false)
-	rs, err := pp.propose(getBlankTestSession(), []byte("test data"), 100)
+	rs, err := pp.propose(context.Background(), getBlankTestSession(), []byte("test data"), 100)
 	if err != nil {
 		t.Errorf("failed to make proposal, %v", err)
 	}
@@ -1060,7 +1274,7 @@ func TestSeriesIDIsCheckedWhenApplyingProposal(t *testing.T) {
 
 func TestProposalCanBeCommitted(t *testing.T) {
 	pp, _ := getPendingProposal(true)
-	rs, err := pp.propose(getBlankTestSession(), []byte("test data"), 100)
+	rs, err := pp.propose(context.Background(), getBlankTestSession(), []byte("test data"), 100)
 	if err != nil {
 		t.Errorf("failed to make proposal, %v", err)
 	}
@@ -1090,7 +1304,7 @@ func TestProposalCanBeCommitted(t *testing.T) {
 func TestProposalCanBeExpired(t *testing.T) {
 	pp, _ := getPendingProposal(false)
 	tickCount := uint64(100)
-	rs, err := pp.propose(getBlankTestSession(), []byte("test data"), tickCount)
+	rs, err := pp.propose(context.Background(), getBlankTestSession(), []byte("test data"), tickCount)
 	if err != nil {
 		t.Errorf("failed to make proposal, %v", err)
 	}
@@ -1122,7 +1336,7 @@ func TestProposalCanBeExpired(t *testing.T) {
 func TestProposalErrorsAreReported(t *testing.T) {
 	pp, c := getPendingProposal(false)
 	for i := 0; i < 5; i++ {
-		_, err := pp.propose(getBlankTestSession(), []byte("test data"), 100)
+		_, err := pp.propose(context.Background(), getBlankTestSession(), []byte("test data"), 100)
 		if err != nil {
 			t.Errorf("propose failed")
 		}
@@ -1134,7 +1348,7 @@ func TestProposalErrorsAreReported(t *testing.T) {
 		cq = c.right
 	}
 	sz := len(cq)
-	_, err := pp.propose(getBlankTestSession(), []byte("test data"), 100)
+	_, err := pp.propose(context.Background(), getBlankTestSession(), []byte("test data"), 100)
 	if err != ErrSystemBusy {
 		t.Errorf("suppose to return ErrSystemBusy")
 	}
@@ -1155,7 +1369,7 @@ func TestClosePendingProposalIgnoresStepEngineActivities(t *testing.T) {
 		SeriesID:    200,
 		RespondedTo: 199,
 	}
-	rs, _ := pp.propose(session, nil, 100)
+	rs, _ := pp.propose(context.Background(), session, nil, 100)
 	select {
 	case <-rs.ResultC():
 		t.Fatalf("completedC is already signalled")
@@ -1198,14 +1412,14 @@ func TestPendingReadIndexCanBeCreatedAndClosed(t *testing.T) {
 func TestCanNotMakeRequestOnClosedPendingReadIndex(t *testing.T) {
 	pp, _ := getPendingReadIndex()
 	pp.close()
-	if _, err := pp.read(100); err != ErrShardClosed {
+	if _, err := pp.read(context.Background(), 100); err != ErrShardClosed {
 		t.Errorf("failed to return ErrShardClosed %v", err)
 	}
 }
 
 func TestPendingReadIndexCanRead(t *testing.T) {
 	pp, c := getPendingReadIndex()
-	rs, err := pp.read(100)
+	rs, err := pp.read(context.Background(), 100)
 	if err != nil {
 		t.Errorf("failed to do read")
 	}
@@ -1243,7 +1457,7 @@ func TestPendingReadIndexCanRead(t *testing.T) {
 func TestPendingReadIndexCanReturnBusy(t *testing.T) {
 	pri, _ := getPendingReadIndex()
 	for i := 0; i < 6; i++ {
-		_, err := pri.read(100)
+		_, err := pri.read(context.Background(), 100)
 		if i != 5 && err != nil {
 			t.Errorf("failed to do read")
 		}
@@ -1255,7 +1469,7 @@ func TestPendingReadIndexCanReturnBusy(t *testing.T) {
 
 func TestPendingReadIndexCanComplete(t *testing.T) {
 	pp, _ := getPendingReadIndex()
-	rs, err := pp.read(100)
+	rs, err := pp.read(context.Background(), 100)
 	if err != nil {
 		t.Errorf("failed to do read")
 	}
@@ -1289,9 +1503,33 @@ func TestPendingReadIndexCanComplete(t *testing.T) {
 	}
 }
 
+func TestPendingReadIndexRecyclesRequestHolders(t *testing.T) {
+	pp, _ := getPendingReadIndex()
+	rs, err := pp.read(context.Background(), 100)
+	if err != nil {
+		t.Errorf("failed to do read")
+	}
+	s := pp.nextCtx()
+	pp.add(s, []*RequestState{rs})
+	pp.addReady([]pb.ReadyToRead{{Index: 500, SystemCtx: s}})
+	pp.applied(500)
+	if len(pp.holders) != 1 || len(pp.holders[0]) != 0 {
+		t.Fatalf("request holder not recycled")
+	}
+	holder := pp.holders[0][:1]
+	if holder[0] != nil {
+		t.Errorf("recycled holder still references the request")
+	}
+	s = pp.nextCtx()
+	pp.add(s, []*RequestState{rs})
+	if len(pp.holders) != 0 || &pp.batches[s].requests[0] != &holder[0] {
+		t.Errorf("request holder not reused")
+	}
+}
+
 func TestPendingReadIndexCanBeDropped(t *testing.T) {
 	pp, _ := getPendingReadIndex()
-	rs, err := pp.read(100)
+	rs, err := pp.read(context.Background(), 100)
 	if err != nil {
 		t.Errorf("failed to do read")
 	}
@@ -1311,9 +1549,70 @@ func TestPendingReadIndexCanBeDropped(t *testing.T) {
 	}
 }
 
+func TestPendingReadIndexRequestsAreCoalesced(t *testing.T) {
+	pp, _ := getPendingReadIndex()
+	pp.batchDelay = time.Hour
+	pp.rounds = &readIndexStats{}
+	if !pp.canRequest() {
+		t.Fatalf("can not request when there is no round in flight")
+	}
+	rs1, err := pp.read(context.Background(), 100)
+	if err != nil {
+		t.Fatalf("failed to do read %v", err)
+	}
+	rs2, err := pp.read(context.Background(), 100)
+	if err != nil {
+		t.Fatalf("failed to do read %v", err)
+	}
+	s := pp.nextCtx()
+	pp.add(s, []*RequestState{rs1, rs2})
+	if pp.canRequest() || !pp.isInflight() {
+		t.Errorf("can request when a round is in flight")
+	}
+	pp.addReady([]pb.ReadyToRead{{Index: 500, SystemCtx: pb.SystemCtx{Low: 1}}})
+	if pp.canRequest() {
+		t.Errorf("can request when a round is in flight")
+	}
+	pp.addReady([]pb.ReadyToRead{{Index: 500, SystemCtx: s}})
+	if !pp.canRequest() || pp.isInflight() {
+		t.Errorf("can not request after the round completed")
+	}
+	s = pp.nextCtx()
+	pp.add(s, nil)
+	pp.dropped(s)
+	if !pp.canRequest() {
+		t.Errorf("can not request after the round is dropped")
+	}
+	if v := pp.rounds.get(); v.Rounds != 2 || v.Reads != 2 ||
+		v.AverageBatchSize() != 1 {
+		t.Errorf("unexpected stats %+v", v)
+	}
+}
+
+func TestPendingReadIndexCoalescingIsBoundedByDelay(t *testing.T) {
+	pp, _ := getPendingReadIndex()
+	pp.batchDelay = time.Millisecond
+	pp.add(pp.nextCtx(), nil)
+	if pp.canRequest() {
+		t.Errorf("can request when a round is in flight")
+	}
+	time.Sleep(2 * time.Millisecond)
+	if !pp.canRequest() {
+		t.Errorf("can not request after the batch delay")
+	}
+}
+
+func TestPendingReadIndexRequestsAreNotCoalescedByDefault(t *testing.T) {
+	pp, _ := getPendingReadIndex()
+	pp.add(pp.nextCtx(), nil)
+	if !pp.canRequest() || pp.isInflight() {
+		t.Errorf("requests unexpectedly coalesced")
+	}
+}
+
 func testPendingReadIndexCanExpire(t *testing.T, addReady bool) {
 	pp, _ := getPendingReadIndex()
-	rs, err := pp.read(100)
+	rs, err := pp.read(context.Background(), 100)
 	if err != nil {
 		t.Errorf("failed to do read")
 	}
@@ -1351,7 +1650,7 @@ func TestPendingReadIndexCanExpireWithoutCallingAddReady(t *testing.T) {
 
 func TestNonEmptyReadBatchIsNeverExpired(t *testing.T) {
 	pp, _ := getPendingReadIndex()
-	rs, err := pp.read(10000)
+	rs, err := pp.read(context.Background(), 10000)
 	if err != nil {
 		t.Errorf("failed to do read")
 	}
@@ -1387,7 +1686,7 @@ func TestProposalAllocationCount(t *testing.T) {
 	session := client.NewNoOPSession(1, random.LockGuardedRand)
 	ac := testing.AllocsPerRun(10000, func() {
 		v := atomic.AddUint32(&total, 1)
-		rs, err := pp.propose(session, data, 100)
+		rs, err := pp.propose(context.Background(), session, data, 100)
 		if err != nil {
 			t.Errorf("%v", err)
 		}
@@ -1417,7 +1716,7 @@ func TestReadIndexAllocationCount(t *testing.T) {
 	pri := newPendingReadIndex(p, q)
 	ac := testing.AllocsPerRun(10000, func() {
 		v := atomic.AddUint32(&total, 1)
-		rs, err := pri.read(100)
+		rs, err := pri.read(context.Background(), 100)
 		if err != nil {
 			t.Errorf("%v", err)
 		}
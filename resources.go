@@ -0,0 +1,452 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/lni/goutils/syncutil"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/transport"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+var (
+	// ErrResourceGroupInUse indicates that the resource group can not be closed
+	// as it is still used by NodeHost instances.
+	ErrResourceGroupInUse = errors.New("resource group in use")
+	// ErrResourceGroupMismatch indicates that the NodeHost can not use the
+	// resource group as its settings conflict with the group or with other
+	// NodeHost instances in the group.
+	ErrResourceGroupMismatch = errors.New("settings conflict with resource group")
+)
+
+const (
+	defaultResourceGroupName = "resource-group"
+	defaultResourceTick      = time.Millisecond
+	resourceTimerWheelSlots  = 4096
+	sharedListenerModuleName = "shared-" + transport.TCPTransportName
+)
+
+// ResourceGroupOptions are the options used for creating a ResourceGroup.
+type ResourceGroupOptions struct {
+	// Name is the name of the resource group used in logs.
+	Name string
+	// TickInterval is the tick interval of the timer wheel shared by NodeHost
+	// instances in the group. Each NodeHost ticks every RTTMillisecond rounded
+	// up to a multiple of TickInterval. The default value of 1 millisecond is
+	// used when TickInterval is 0.
+	TickInterval time.Duration
+	// CloseWorkers is the number of workers shared by NodeHost instances in the
+	// group for closing state machines of stopped replicas. When CloseWorkers is
+	// 0, each NodeHost uses its own config.EngineConfig.CloseShards workers.
+	CloseWorkers uint64
+	// SharedListener indicates whether NodeHost instances in the group should
+	// share a single listener of the built-in TCP transport module. They must
+	// all have the same RaftAddress and ListenAddress values and have
+	// DefaultNodeRegistryEnabled set in such case, i.e. replicas are addressed
+	// by the NodeHostIDs of their NodeHost instances which are all resolved to
+	// the shared address. Incoming messages and snapshot chunks are
+	// demultiplexed to the NodeHost in the group hosting the target replica,
+	// those targeting replicas not hosted by any NodeHost in the group are
+	// dropped. SharedListener can not be used with
+	// config.ExpertConfig.TransportFactory. Inbound flow control and snapshot
+	// chunk acknowledgements are not available on the shared listener.
+	SharedListener bool
+}
+
+// Validate validates the ResourceGroupOptions instance.
+func (o ResourceGroupOptions) Validate() error {
+	if o.TickInterval < 0 {
+		return errors.New("invalid TickInterval")
+	}
+	return nil
+}
+
+// ResourceGroup is a handle of resources shared by NodeHost instances running
+// in the same process, e.g. NodeHost instances used in test rigs or by
+// sidecars. NodeHost instances join the group when they are created with
+// the group set as their config.ExpertConfig.Resources and leave the group
+// when they are closed. NodeHost instances in the group keep their own
+// identities, directories, LogDB and execution engine, closing a NodeHost
+// doesn't affect other NodeHost instances in the group.
+type ResourceGroup struct {
+	opts    ResourceGroupOptions
+	stopper *syncutil.Stopper
+	wheel   *server.TimerWheel
+	cp      *closeWorkerPool
+	mu      struct {
+		sync.Mutex
+		members  map[string]*groupMember
+		listener *sharedListener
+		closed   bool
+	}
+}
+
+var _ config.Resources = (*ResourceGroup)(nil)
+
+// groupMember is a NodeHost in the resource group, handlers are set once its
+// transport module is started on the shared listener.
+type groupMember struct {
+	nh           *NodeHost
+	handler      raftio.MessageHandler
+	chunkHandler raftio.ChunkHandler
+}
+
+func (m *groupMember) hasReplica(shardID uint64, replicaID uint64) bool {
+	return m.nh.msgHandler.HasReplica(shardID, replicaID)
+}
+
+// sharedListener is the built-in TCP transport module shared by NodeHost
+// instances in the group, it is closed once the last NodeHost stops using it.
+type sharedListener struct {
+	trans         raftio.ITransport
+	raftAddress   string
+	listenAddress string
+	refs          int
+}
+
+// NewResourceGroup creates a ResourceGroup instance that can be shared by
+// NodeHost instances created in the same process by setting it as their
+// config.ExpertConfig.Resources. The group owns a timer wheel driving the
+// ticks of all NodeHost instances in it, an optional pool of close workers and
+// an optional listener of the built-in TCP transport module, see
+// ResourceGroupOptions for details. The group should be closed once all
+// NodeHost instances in it are closed.
+func NewResourceGroup(opts ResourceGroupOptions) (*ResourceGroup, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if len(opts.Name) == 0 {
+		opts.Name = defaultResourceGroupName
+	}
+	if opts.TickInterval == 0 {
+		opts.TickInterval = defaultResourceTick
+	}
+	rg := &ResourceGroup{
+		opts:    opts,
+		stopper: syncutil.NewStopper(),
+		wheel: server.NewTimerWheel(opts.TickInterval,
+			resourceTimerWheelSlots),
+	}
+	rg.mu.members = make(map[string]*groupMember)
+	if opts.CloseWorkers > 0 {
+		epoch := time.Now()
+		stats := make([]*workerStats, 0, opts.CloseWorkers)
+		for i := uint64(0); i < opts.CloseWorkers; i++ {
+			stats = append(stats, newWorkerStats(epoch, i, nil))
+		}
+		rg.cp = newCloseWorkerPool(opts.CloseWorkers, false, stats)
+	}
+	rg.stopper.RunWorker(func() {
+		rg.tickMain()
+	})
+	return rg, nil
+}
+
+// Name returns the name of the resource group.
+func (rg *ResourceGroup) Name() string {
+	return rg.opts.Name
+}
+
+// Close releases all resources owned by the group. ErrResourceGroupInUse is
+// returned when there are NodeHost instances in the group that are not
+// closed yet.
+func (rg *ResourceGroup) Close() error {
+	rg.mu.Lock()
+	if rg.mu.closed {
+		rg.mu.Unlock()
+		return ErrClosed
+	}
+	if len(rg.mu.members) > 0 {
+		rg.mu.Unlock()
+		return ErrResourceGroupInUse
+	}
+	rg.mu.closed = true
+	rg.mu.Unlock()
+	rg.stopper.Stop()
+	if rg.cp != nil {
+		return rg.cp.close()
+	}
+	return nil
+}
+
+func (rg *ResourceGroup) tickMain() {
+	ticker := time.NewTicker(rg.opts.TickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rg.wheel.Tick()
+		case <-rg.stopper.ShouldStop():
+			return
+		}
+	}
+}
+
+// join adds the NodeHost to the group.
+func (rg *ResourceGroup) join(nh *NodeHost) error {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	if rg.mu.closed {
+		return ErrClosed
+	}
+	if rg.opts.SharedListener {
+		if nh.nhConfig.Expert.TransportFactory != nil {
+			plog.Errorf("%s, TransportFactory set with a shared listener",
+				rg.opts.Name)
+			return ErrResourceGroupMismatch
+		}
+		if !nh.nhConfig.DefaultNodeRegistryEnabled {
+			plog.Errorf("%s, shared listener requires DefaultNodeRegistryEnabled",
+				rg.opts.Name)
+			return ErrResourceGroupMismatch
+		}
+	}
+	if _, ok := rg.mu.members[nh.ID()]; ok {
+		plog.Errorf("%s, NodeHost %s already in the group", rg.opts.Name, nh.ID())
+		return ErrResourceGroupMismatch
+	}
+	rg.mu.members[nh.ID()] = &groupMember{nh: nh}
+	plog.Infof("NodeHost %s joined %s", nh.ID(), rg.opts.Name)
+	return nil
+}
+
+// leave removes the NodeHost from the group.
+func (rg *ResourceGroup) leave(nh *NodeHost) {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	if m, ok := rg.mu.members[nh.ID()]; ok && m.nh == nh {
+		delete(rg.mu.members, nh.ID())
+	}
+}
+
+// subscribeTick returns a channel notified every specified interval by the
+// shared timer wheel. The returned timer must be stopped once the channel is
+// no longer used.
+func (rg *ResourceGroup) subscribeTick(
+	interval time.Duration) (<-chan struct{}, *server.Timer) {
+	tickC := make(chan struct{}, 1)
+	timer := rg.wheel.Every(rg.wheel.Ticks(interval), func() {
+		select {
+		case tickC <- struct{}{}:
+		default:
+		}
+	})
+	return tickC, timer
+}
+
+// getTransportFactory returns the factory used for creating the transport
+// module of the specified NodeHost, it is nil when the listener is not shared.
+func (rg *ResourceGroup) getTransportFactory(
+	nh *NodeHost) config.TransportFactory {
+	if !rg.opts.SharedListener {
+		return nil
+	}
+	return &groupTransportFactory{rg: rg, nh: nh}
+}
+
+func (rg *ResourceGroup) startListener(t *groupTransport) error {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	m, ok := rg.mu.members[t.nh.ID()]
+	if !ok {
+		return ErrClosed
+	}
+	l := rg.mu.listener
+	if l == nil {
+		trans := transport.NewTCPTransport(t.nhConfig,
+			rg.handleMessageBatch, rg.handleChunk)
+		if err := trans.Start(); err != nil {
+			if cerr := trans.Close(); cerr != nil {
+				plog.Errorf("failed to close the shared listener %v", cerr)
+			}
+			return err
+		}
+		l = &sharedListener{
+			trans:         trans,
+			raftAddress:   t.nhConfig.RaftAddress,
+			listenAddress: t.nhConfig.ListenAddress,
+		}
+		rg.mu.listener = l
+		plog.Infof("%s is listening on %s", rg.opts.Name, l.raftAddress)
+	} else if l.raftAddress != t.nhConfig.RaftAddress ||
+		l.listenAddress != t.nhConfig.ListenAddress {
+		plog.Errorf("%s, address %s, shared listener address %s",
+			rg.opts.Name, t.nhConfig.RaftAddress, l.raftAddress)
+		return ErrResourceGroupMismatch
+	}
+	l.refs++
+	m.handler = t.handler
+	m.chunkHandler = t.chunkHandler
+	return nil
+}
+
+func (rg *ResourceGroup) stopListener(t *groupTransport) error {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	if m, ok := rg.mu.members[t.nh.ID()]; ok {
+		m.handler = nil
+		m.chunkHandler = nil
+	}
+	l := rg.mu.listener
+	if l == nil {
+		return nil
+	}
+	l.refs--
+	if l.refs > 0 {
+		return nil
+	}
+	rg.mu.listener = nil
+	return l.trans.Close()
+}
+
+func (rg *ResourceGroup) getListener() raftio.ITransport {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	if rg.mu.listener == nil {
+		return nil
+	}
+	return rg.mu.listener.trans
+}
+
+func (rg *ResourceGroup) getReceivers() []*groupMember {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	result := make([]*groupMember, 0, len(rg.mu.members))
+	for _, m := range rg.mu.members {
+		if m.handler != nil {
+			result = append(result, &groupMember{
+				nh:           m.nh,
+				handler:      m.handler,
+				chunkHandler: m.chunkHandler,
+			})
+		}
+	}
+	return result
+}
+
+// handleMessageBatch demultiplexes the message batch received by the shared
+// listener, requests are delivered to the NodeHost hosting their targets.
+func (rg *ResourceGroup) handleMessageBatch(mb pb.MessageBatch) {
+	for _, m := range rg.getReceivers() {
+		var requests []pb.Message
+		for _, req := range mb.Requests {
+			if m.hasReplica(req.ShardID, req.To) {
+				requests = append(requests, req)
+			}
+		}
+		if len(requests) > 0 {
+			batch := mb
+			batch.Requests = requests
+			m.handler(batch)
+		}
+	}
+}
+
+// handleChunk delivers the snapshot chunk received by the shared listener to
+// the NodeHost hosting its target.
+func (rg *ResourceGroup) handleChunk(c pb.Chunk) bool {
+	for _, m := range rg.getReceivers() {
+		if m.hasReplica(c.ShardID, c.ReplicaID) {
+			return m.chunkHandler(c)
+		}
+	}
+	plog.Warningf("%s dropped chunk for unknown %s",
+		rg.opts.Name, dn(c.ShardID, c.ReplicaID))
+	return false
+}
+
+// groupTransportFactory creates the transport module of a NodeHost using the
+// listener shared by the resource group.
+type groupTransportFactory struct {
+	rg *ResourceGroup
+	nh *NodeHost
+}
+
+var _ config.TransportFactory = (*groupTransportFactory)(nil)
+
+func (f *groupTransportFactory) Create(nhConfig config.NodeHostConfig,
+	handler raftio.MessageHandler,
+	chunkHandler raftio.ChunkHandler) raftio.ITransport {
+	return &groupTransport{
+		rg:           f.rg,
+		nh:           f.nh,
+		nhConfig:     nhConfig,
+		handler:      handler,
+		chunkHandler: chunkHandler,
+	}
+}
+
+func (f *groupTransportFactory) Validate(addr string) bool {
+	return config.IsValidAddress(addr)
+}
+
+// groupTransport is the transport module of a NodeHost in the resource group,
+// connections are created using the shared listener.
+type groupTransport struct {
+	rg           *ResourceGroup
+	nh           *NodeHost
+	nhConfig     config.NodeHostConfig
+	handler      raftio.MessageHandler
+	chunkHandler raftio.ChunkHandler
+	started      bool
+}
+
+var _ raftio.ITransport = (*groupTransport)(nil)
+
+func (t *groupTransport) Name() string {
+	return sharedListenerModuleName
+}
+
+func (t *groupTransport) Start() error {
+	if err := t.rg.startListener(t); err != nil {
+		return err
+	}
+	t.started = true
+	return nil
+}
+
+func (t *groupTransport) Close() error {
+	if !t.started {
+		return nil
+	}
+	t.started = false
+	return t.rg.stopListener(t)
+}
+
+func (t *groupTransport) GetConnection(ctx context.Context,
+	target string) (raftio.IConnection, error) {
+	trans := t.rg.getListener()
+	if trans == nil {
+		return nil, ErrClosed
+	}
+	return trans.GetConnection(ctx, target)
+}
+
+func (t *groupTransport) GetSnapshotConnection(ctx context.Context,
+	target string) (raftio.ISnapshotConnection, error) {
+	trans := t.rg.getListener()
+	if trans == nil {
+		return nil, ErrClosed
+	}
+	return trans.GetSnapshotConnection(ctx, target)
+}
@@ -0,0 +1,153 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+func TestResourceGroupOptionsAreValidated(t *testing.T) {
+	opts := ResourceGroupOptions{TickInterval: -time.Millisecond}
+	if _, err := NewResourceGroup(opts); err == nil {
+		t.Fatalf("invalid options not rejected")
+	}
+	rg, err := NewResourceGroup(ResourceGroupOptions{})
+	if err != nil {
+		t.Fatalf("failed to create resource group %v", err)
+	}
+	if rg.Name() != defaultResourceGroupName ||
+		rg.opts.TickInterval != defaultResourceTick {
+		t.Errorf("unexpected options %+v", rg.opts)
+	}
+	if err := rg.Close(); err != nil {
+		t.Fatalf("failed to close %v", err)
+	}
+	if err := rg.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestNodeHostsCanShareResourceGroup(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		rg, err := NewResourceGroup(ResourceGroupOptions{
+			CloseWorkers:   2,
+			SharedListener: true,
+		})
+		if err != nil {
+			t.Fatalf("failed to create resource group %v", err)
+		}
+		if err := fs.MkdirAll(singleNodeHostTestDir, 0755); err != nil {
+			t.Fatalf("failed to create dir %v", err)
+		}
+		// all NodeHost instances are reachable at the same address
+		nhids := []string{testNodeHostID1, testNodeHostID2,
+			"123e4567-e89b-12d3-a456-426614174002"}
+		addrs := make(map[string]string)
+		for _, nhid := range nhids {
+			addrs[nhid] = nodeHostTestAddr1
+		}
+		fn := fs.PathJoin(singleNodeHostTestDir, "registry.json")
+		writeStaticRegistryFile(t, fs, fn, addrs)
+		nhs := make([]*NodeHost, len(nhids))
+		members := make(map[uint64]string)
+		for i, nhid := range nhids {
+			dir := fs.PathJoin(singleNodeHostTestDir, fmt.Sprintf("nh%d", i+1))
+			expert := getTestExpertConfig(fs)
+			expert.Resources = rg
+			nhc := config.NodeHostConfig{
+				NodeHostDir:                dir,
+				RTTMillisecond:             getRTTMillisecond(fs, dir),
+				RaftAddress:                nodeHostTestAddr1,
+				NodeHostID:                 nhid,
+				DefaultNodeRegistryEnabled: true,
+				StaticRegistry:             config.StaticRegistryConfig{File: fn},
+				Expert:                     expert,
+			}
+			nh, err := NewNodeHost(nhc)
+			if err != nil {
+				t.Fatalf("failed to create node host %v", err)
+			}
+			nhs[i] = nh
+			members[uint64(i+1)] = nhid
+		}
+		closed := make([]bool, len(nhs))
+		defer func() {
+			for i, nh := range nhs {
+				if !closed[i] {
+					nh.Close()
+				}
+			}
+			if err := rg.Close(); err != nil {
+				t.Errorf("failed to close resource group %v", err)
+			}
+		}()
+		if nhs[0].transport.Name() != sharedListenerModuleName {
+			t.Errorf("unexpected transport module %s", nhs[0].transport.Name())
+		}
+		startCloneTestShard(t, nhs, 1, []uint64{1, 2, 3}, members)
+		for _, nh := range nhs {
+			waitForLeaderToBeElected(t, nh, 1)
+		}
+		propose := func(nh *NodeHost, cmd string) {
+			ctx, cancel := context.WithTimeout(context.Background(), lpto(nh))
+			defer cancel()
+			if _, err := nh.SyncPropose(ctx,
+				nh.GetNoOPSession(1), []byte(cmd)); err != nil {
+				t.Fatalf("failed to propose %v", err)
+			}
+		}
+		propose(nhs[0], "a=1")
+		for _, nh := range nhs {
+			if v := readCloneTestValue(t, nh, 1, "a"); v != "1" {
+				t.Errorf("unexpected value %s", v)
+			}
+		}
+		if err := rg.Close(); !errors.Is(err, ErrResourceGroupInUse) {
+			t.Errorf("unexpected error %v", err)
+		}
+		// closing a NodeHost doesn't affect others in the group
+		leaderID, _, _, err := nhs[0].GetLeaderID(1)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		stopped := 2
+		if leaderID == 3 {
+			stopped = 1
+		}
+		nhs[stopped].Close()
+		closed[stopped] = true
+		live := nhs[0]
+		if stopped == 0 {
+			live = nhs[1]
+		}
+		propose(live, "b=2")
+		if v := readCloneTestValue(t, live, 1, "b"); v != "2" {
+			t.Errorf("unexpected value %s", v)
+		}
+		if rg.getListener() == nil {
+			t.Errorf("shared listener unexpectedly closed")
+		}
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
@@ -0,0 +1,258 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// RetainedSnapshot is a snapshot of a replica kept on disk, see
+// config.Config.SnapshotsToKeep for details.
+type RetainedSnapshot struct {
+	// Index and Term are the Raft log index and term of the snapshot. Term is 0
+	// when the metadata of the snapshot is not available, e.g. the snapshot was
+	// received from a remote replica running an older version of Dragonboat.
+	Index uint64
+	Term  uint64
+	// Size is the total size in bytes of all files in the snapshot directory,
+	// including external files of the snapshot.
+	Size uint64
+	// Filepath is the path of the snapshot file, it can be used for opening
+	// the snapshot image of a retained older snapshot.
+	Filepath string
+}
+
+// ListSnapshots returns snapshots of the specified shard kept on disk by the
+// local replica, newest first. The first returned snapshot is the latest one,
+// the rest are older snapshots retained as specified by
+// config.Config.SnapshotsToKeep.
+//
+// Retained older snapshots are not used by Dragonboat, they will be removed
+// once newer snapshots are created. Applications opening their files must be
+// prepared for the files to be removed at any time.
+func (nh *NodeHost) ListSnapshots(shardID uint64) ([]RetainedSnapshot, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nil, ErrShardNotFound
+	}
+	return n.snapshotter.listSnapshots()
+}
+
+// retainedStats is the disk usage of snapshots kept on disk by a replica.
+type retainedStats struct {
+	count uint64
+	size  uint64
+}
+
+func (s *snapshotter) getRetainedStats() (uint64, uint64) {
+	return atomic.LoadUint64(&s.retained.count),
+		atomic.LoadUint64(&s.retained.size)
+}
+
+func (s *snapshotter) updateRetainedStats() {
+	ssList, err := s.listSnapshots()
+	if err != nil {
+		plog.Warningf("%s failed to list snapshots, %v", s.id(), err)
+		return
+	}
+	size := uint64(0)
+	for _, ss := range ssList {
+		size += ss.Size
+	}
+	atomic.StoreUint64(&s.retained.count, uint64(len(ssList)))
+	atomic.StoreUint64(&s.retained.size, size)
+}
+
+// release is invoked when the snapshot at the specified index is no longer
+// the latest snapshot and is no longer in use. The snapshot is removed unless
+// it is among the newest keep snapshots on disk or it is pinned.
+func (s *snapshotter) release(index uint64) error {
+	var err error
+	s.mu.Lock()
+	if s.keep <= 1 && s.mu.pinned[index] == 0 {
+		err = s.remove(index)
+	} else {
+		s.mu.released[index] = struct{}{}
+		err = s.removeReleased()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.updateRetainedStats()
+	return nil
+}
+
+// pin prevents the snapshot at the specified index from being removed until
+// it is unpinned. ErrNoSnapshot is returned when the snapshot is not on disk.
+func (s *snapshotter) pin(index uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	env := s.getEnv(index)
+	if _, err := s.fs.Stat(env.GetFinalDir()); err != nil {
+		if vfs.IsNotExist(err) {
+			return errors.Wrapf(ErrNoSnapshot, "%s", s.ssid(index))
+		}
+		return err
+	}
+	s.mu.pinned[index]++
+	return nil
+}
+
+// unpin unpins the snapshot at the specified index, the snapshot is removed
+// once it is no longer pinned if it has been released in the meantime.
+func (s *snapshotter) unpin(index uint64) {
+	s.mu.Lock()
+	s.mu.pinned[index]--
+	if s.mu.pinned[index] > 0 {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.mu.pinned, index)
+	err := s.removeReleased()
+	s.mu.Unlock()
+	if err != nil {
+		plog.Warningf("%s failed to remove released snapshots, %v", s.id(), err)
+		return
+	}
+	s.updateRetainedStats()
+}
+
+// retainOlder is invoked when the replica is restarted. older contains indexes
+// of complete snapshots older than the latest snapshot found on disk, newest
+// keep-1 of them are retained and the rest are removed.
+func (s *snapshotter) retainOlder(older []uint64) error {
+	s.mu.Lock()
+	for _, index := range older {
+		s.mu.released[index] = struct{}{}
+	}
+	err := s.removeReleased()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.updateRetainedStats()
+	return nil
+}
+
+// removeReleased removes released snapshots not among the newest keep
+// snapshots on disk. Snapshots still in use are counted but never removed, they
+// are removed once released. Pinned snapshots are removed once unpinned.
+func (s *snapshotter) removeReleased() error {
+	indexes, err := s.listSnapshotIndexes()
+	if err != nil {
+		return err
+	}
+	onDisk := make(map[uint64]struct{}, len(indexes))
+	for i, index := range indexes {
+		onDisk[index] = struct{}{}
+		if uint64(i) < s.keep {
+			continue
+		}
+		if _, ok := s.mu.released[index]; ok && s.mu.pinned[index] == 0 {
+			plog.Infof("%s removing retained %s", s.id(), s.ssid(index))
+			if err := s.remove(index); err != nil {
+				return err
+			}
+			delete(s.mu.released, index)
+		}
+	}
+	for index := range s.mu.released {
+		if _, ok := onDisk[index]; !ok {
+			delete(s.mu.released, index)
+		}
+	}
+	return nil
+}
+
+// listSnapshotIndexes returns indexes of complete snapshots found in the
+// snapshot directory, newest first.
+func (s *snapshotter) listSnapshotIndexes() ([]uint64, error) {
+	files, err := s.fs.List(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	indexes := make([]uint64, 0)
+	for _, n := range files {
+		if s.isSnapshot(n) {
+			indexes = append(indexes, s.parseIndex(n))
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i] > indexes[j]
+	})
+	return indexes, nil
+}
+
+func (s *snapshotter) listSnapshots() ([]RetainedSnapshot, error) {
+	indexes, err := s.listSnapshotIndexes()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]RetainedSnapshot, 0, len(indexes))
+	for _, index := range indexes {
+		ss, err := s.getRetainedSnapshot(index)
+		if err != nil {
+			if vfs.IsNotExist(err) {
+				// removed after being listed
+				continue
+			}
+			return nil, err
+		}
+		result = append(result, ss)
+	}
+	return result, nil
+}
+
+func (s *snapshotter) getRetainedSnapshot(index uint64) (RetainedSnapshot, error) {
+	env := s.getEnv(index)
+	dir := env.GetFinalDir()
+	rs := RetainedSnapshot{
+		Index:    index,
+		Filepath: env.GetFilepath(),
+	}
+	var ss pb.Snapshot
+	if err := fileutil.GetFlagFileContent(dir,
+		server.MetadataFilename, &ss, s.fs); err == nil {
+		rs.Term = ss.Term
+	} else if !vfs.IsNotExist(err) {
+		return RetainedSnapshot{}, err
+	}
+	files, err := s.fs.List(dir)
+	if err != nil {
+		return RetainedSnapshot{}, err
+	}
+	for _, n := range files {
+		fi, err := s.fs.Stat(s.fs.PathJoin(dir, n))
+		if err != nil {
+			return RetainedSnapshot{}, err
+		}
+		if !fi.IsDir() {
+			rs.Size += uint64(fi.Size())
+		}
+	}
+	return rs, nil
+}
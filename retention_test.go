@@ -0,0 +1,234 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/tests"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func commitTestSnapshot(t *testing.T, s *snapshotter, index uint64) {
+	env := s.getEnv(index)
+	if err := env.CreateTempDir(); err != nil {
+		t.Fatalf("failed to create snapshot dir %v", err)
+	}
+	ss := pb.Snapshot{Index: index, Term: 2}
+	if err := s.Commit(ss, rsm.SSRequest{}); err != nil {
+		t.Fatalf("failed to commit snapshot %v", err)
+	}
+}
+
+func getTestSnapshotIndexes(t *testing.T, s *snapshotter) []uint64 {
+	ssList, err := s.listSnapshots()
+	if err != nil {
+		t.Fatalf("failed to list snapshots %v", err)
+	}
+	result := make([]uint64, 0)
+	for _, ss := range ssList {
+		if ss.Term != 2 {
+			t.Errorf("unexpected term %d", ss.Term)
+		}
+		result = append(result, ss.Index)
+	}
+	return result
+}
+
+func checkTestSnapshotIndexes(t *testing.T, s *snapshotter, expected []uint64) {
+	indexes := getTestSnapshotIndexes(t, s)
+	if len(indexes) != len(expected) {
+		t.Fatalf("got %v, want %v", indexes, expected)
+	}
+	for i := range indexes {
+		if indexes[i] != expected[i] {
+			t.Fatalf("got %v, want %v", indexes, expected)
+		}
+	}
+	if count, _ := s.getRetainedStats(); count != uint64(len(expected)) {
+		t.Errorf("retained count %d, want %d", count, len(expected))
+	}
+}
+
+func TestSnapshotterKeepsNewestSnapshots(t *testing.T) {
+	fs := vfs.GetTestFS()
+	fn := func(t *testing.T, ldb raftio.ILogDB, s *snapshotter) {
+		s.keep = 3
+		for i := uint64(1); i <= 5; i++ {
+			commitTestSnapshot(t, s, i*100)
+			if i > 1 {
+				if err := s.Compact((i - 1) * 100); err != nil {
+					t.Fatalf("compact failed %v", err)
+				}
+			}
+		}
+		checkTestSnapshotIndexes(t, s, []uint64{500, 400, 300})
+	}
+	runSnapshotterTest(t, fn, fs)
+}
+
+func TestSnapshotterDoesNotRemoveSnapshotsInUse(t *testing.T) {
+	fs := vfs.GetTestFS()
+	fn := func(t *testing.T, ldb raftio.ILogDB, s *snapshotter) {
+		s.keep = 2
+		for i := uint64(1); i <= 4; i++ {
+			commitTestSnapshot(t, s, i*100)
+		}
+		// snapshot 100 and 200 are still in use
+		if err := s.Compact(300); err != nil {
+			t.Fatalf("compact failed %v", err)
+		}
+		checkTestSnapshotIndexes(t, s, []uint64{400, 300, 200, 100})
+		if err := s.Compact(100); err != nil {
+			t.Fatalf("compact failed %v", err)
+		}
+		checkTestSnapshotIndexes(t, s, []uint64{400, 300, 200})
+		if err := s.Compact(200); err != nil {
+			t.Fatalf("compact failed %v", err)
+		}
+		checkTestSnapshotIndexes(t, s, []uint64{400, 300})
+	}
+	runSnapshotterTest(t, fn, fs)
+}
+
+func TestSnapshotterRetainsNewestSnapshotsOnRestart(t *testing.T) {
+	fs := vfs.GetTestFS()
+	fn := func(t *testing.T, ldb raftio.ILogDB, s *snapshotter) {
+		s.keep = 2
+		for i := uint64(1); i <= 4; i++ {
+			commitTestSnapshot(t, s, i*100)
+		}
+		// snapshot 400 is the latest one in LogDB
+		if err := s.processOrphans(); err != nil {
+			t.Fatalf("failed to process orphans %v", err)
+		}
+		checkTestSnapshotIndexes(t, s, []uint64{400, 300})
+		commitTestSnapshot(t, s, 500)
+		if err := s.Compact(400); err != nil {
+			t.Fatalf("compact failed %v", err)
+		}
+		checkTestSnapshotIndexes(t, s, []uint64{500, 400})
+	}
+	runSnapshotterTest(t, fn, fs)
+}
+
+func TestListSnapshotsReturnsRetainedSnapshots(t *testing.T) {
+	fs := vfs.GetTestFS()
+	// older snapshots are released asynchronously after new snapshots are taken
+	waitForSnapshots := func(nh *NodeHost, expected int) []RetainedSnapshot {
+		var ssList []RetainedSnapshot
+		for i := 0; i < 500; i++ {
+			var err error
+			if ssList, err = nh.ListSnapshots(1); err != nil {
+				t.Fatalf("failed to list snapshots %v", err)
+			}
+			ci := nh.GetNodeHostInfo(DefaultNodeHostInfoOption).ShardInfoList[0]
+			if len(ssList) == expected && ci.RetainedSnapshots == uint64(expected) {
+				return ssList
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("got %d snapshots, want %d, %+v", len(ssList), expected, ssList)
+		return nil
+	}
+	check := func(nh *NodeHost, expected int) {
+		ssList := waitForSnapshots(nh, expected)
+		size := uint64(0)
+		for i, ss := range ssList {
+			if i > 0 && ss.Index >= ssList[i-1].Index {
+				t.Errorf("snapshots not sorted, %+v", ssList)
+			}
+			if ss.Term == 0 || ss.Size == 0 {
+				t.Errorf("unexpected snapshot %+v", ss)
+			}
+			if _, err := fs.Stat(ss.Filepath); err != nil {
+				t.Errorf("failed to stat snapshot file %v", err)
+			}
+			size += ss.Size
+		}
+		ci := nh.GetNodeHostInfo(DefaultNodeHostInfoOption).ShardInfoList[0]
+		if ci.RetainedSnapshotSize != size {
+			t.Errorf("retained size %d, want %d", ci.RetainedSnapshotSize, size)
+		}
+	}
+	to := &testOption{
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &tests.NoOP{}
+		},
+		restartNodeHost: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.SnapshotsToKeep = 3
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			for i := 0; i < 5; i++ {
+				proposeTestData(t, nh, "retained", 2)
+				requestTestSnapshot(t, nh)
+				if i < 3 {
+					check(nh, i+1)
+				}
+			}
+			check(nh, 3)
+		},
+		rf: func(nh *NodeHost) {
+			waitForLeaderToBeElected(t, nh, 1)
+			check(nh, 3)
+			proposeTestData(t, nh, "retained", 2)
+			requestTestSnapshot(t, nh)
+			check(nh, 3)
+			if _, err := nh.ListSnapshots(2); !errors.Is(err, ErrShardNotFound) {
+				t.Errorf("unexpected error %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestOnlyLatestSnapshotIsKeptByDefault(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			var index uint64
+			for i := 0; i < 3; i++ {
+				proposeTestData(t, nh, "latest", 2)
+				index = requestTestSnapshot(t, nh)
+			}
+			var ssList []RetainedSnapshot
+			for i := 0; i < 500; i++ {
+				var err error
+				if ssList, err = nh.ListSnapshots(1); err != nil {
+					t.Fatalf("failed to list snapshots %v", err)
+				}
+				if len(ssList) == 1 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if len(ssList) != 1 || ssList[0].Index != index {
+				t.Errorf("unexpected snapshots %+v", ssList)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
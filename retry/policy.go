@@ -0,0 +1,166 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Backoff returns the delay before a retry.
+type Backoff interface {
+	// Delay returns the delay before the specified retry, retry starts from 1.
+	Delay(retry int) time.Duration
+}
+
+// Constant is a Backoff that always waits for the same delay.
+type Constant time.Duration
+
+// Delay returns the constant delay.
+func (c Constant) Delay(retry int) time.Duration {
+	return time.Duration(c)
+}
+
+// Exponential is a Backoff with exponentially increasing delays. The delay
+// before the nth retry is Initial*Multiplier^(n-1) capped at Max, it is then
+// randomly reduced by up to Jitter of its value so retries made by concurrent
+// callers are spread out.
+type Exponential struct {
+	// Initial is the delay before the first retry.
+	Initial time.Duration
+	// Max is the maximum delay, delays are not capped when it is 0.
+	Max time.Duration
+	// Multiplier is the factor applied to the delay after each retry, 2 is
+	// used when it is 0.
+	Multiplier float64
+	// Jitter is the fraction of the delay to be randomized, it is expected to
+	// be in the range of [0, 1].
+	Jitter float64
+}
+
+// Delay returns the delay before the specified retry.
+func (e Exponential) Delay(retry int) time.Duration {
+	m := e.Multiplier
+	if m == 0 {
+		m = 2
+	}
+	d := float64(e.Initial) * math.Pow(m, float64(retry-1))
+	if e.Max > 0 && d > float64(e.Max) {
+		d = float64(e.Max)
+	}
+	if e.Jitter > 0 {
+		d -= d * e.Jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// Budget limits the number of retries made by all calls sharing it. Each
+// retry withdraws a token from the budget, each successful call deposits
+// Ratio tokens back up to the initial number of tokens. Once the budget is
+// exhausted, failed calls are no longer retried until enough calls succeed,
+// this prevents retries from amplifying the load of an overloaded shard.
+type Budget struct {
+	mu     sync.Mutex
+	tokens float64
+	max    float64
+	ratio  float64
+}
+
+// NewBudget returns a new Budget with the specified number of tokens. ratio
+// is the number of tokens deposited by each successful call, e.g. 0.1 allows
+// one retry for every 10 successful calls once the initial tokens are used.
+func NewBudget(tokens int, ratio float64) *Budget {
+	return &Budget{
+		tokens: float64(tokens),
+		max:    float64(tokens),
+		ratio:  ratio,
+	}
+}
+
+// Tokens returns the number of available tokens.
+func (b *Budget) Tokens() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens
+}
+
+func (b *Budget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *Budget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.max, b.tokens+b.ratio)
+}
+
+// Policy specifies how failed requests are retried.
+type Policy struct {
+	// MaxAttempts is the maximum number of attempts including the first one,
+	// the number of attempts is only limited by the context and the Budget
+	// when it is 0.
+	MaxAttempts int
+	// AttemptTimeout is the timeout of each attempt. Each attempt uses the
+	// context of the caller when it is 0, requests failed with ErrTimeout are
+	// not retried in that case as the context is done.
+	AttemptTimeout time.Duration
+	// Backoff determines the delay before each retry, retries are made
+	// immediately when it is nil.
+	Backoff Backoff
+	// Budget is the optional Budget shared by calls using the Policy.
+	Budget *Budget
+}
+
+// DefaultPolicy is the default Policy, it makes up to 5 attempts each with a
+// timeout of 3 seconds.
+var DefaultPolicy = Policy{
+	MaxAttempts:    5,
+	AttemptTimeout: 3 * time.Second,
+	Backoff: Exponential{
+		Initial:    50 * time.Millisecond,
+		Max:        time.Second,
+		Multiplier: 2,
+		Jitter:     0.5,
+	},
+}
+
+// next returns the delay before the next retry after the specified number of
+// failed attempts, false is returned when no more retry is allowed.
+func (p Policy) next(attempts int) (time.Duration, bool) {
+	if p.MaxAttempts > 0 && attempts >= p.MaxAttempts {
+		return 0, false
+	}
+	if !p.Budget.withdraw() {
+		return 0, false
+	}
+	if p.Backoff == nil {
+		return 0, true
+	}
+	return p.Backoff.Delay(attempts), true
+}
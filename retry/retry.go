@@ -0,0 +1,183 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package retry provides bounded retries of requests made using the
+dragonboat.Client interface.
+
+Requests failed with errors classified as retryable by IsRetryable are
+retried according to a Policy, which limits the number of attempts, the
+timeout of each attempt and the delay between attempts. Retries made by many
+callers can be further limited by a Budget shared by their Policy.
+
+Proposals made with registered client sessions are retried using the same
+series ID so they are applied at most once, the session is updated by calling
+ProposalCompleted once the outcome of the proposal is known. Proposals made
+with NO-OP sessions can be applied more than once when retried, they are not
+retried once their outcome becomes unknown, ErrAmbiguousOutcome is returned
+instead so the caller can decide what to do.
+*/
+package retry
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/client"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+var (
+	// ErrAmbiguousOutcome indicates that the proposal failed in a way that it
+	// might have been applied or might be applied later. Returned errors are
+	// also marked with the error of the last attempt, e.g. errors.Is(err,
+	// dragonboat.ErrTimeout) is true when the last attempt timed out.
+	ErrAmbiguousOutcome = errors.New("proposal outcome is unknown")
+)
+
+// IsRetryable returns a boolean value indicating whether a request failed
+// with the specified error can be retried on the same NodeHost instance with
+// the exact same input. Unlike dragonboat.IsTempError, errors caused by the
+// NodeHost or the local replica being closed are not retryable.
+func IsRetryable(err error) bool {
+	return errors.Is(err, dragonboat.ErrSystemBusy) ||
+		errors.Is(err, dragonboat.ErrShardNotInitialized) ||
+		errors.Is(err, dragonboat.ErrShardNotReady) ||
+		errors.Is(err, dragonboat.ErrTimeout) ||
+		errors.Is(err, dragonboat.ErrAborted) ||
+		errors.Is(err, dragonboat.ErrTargetLagging) ||
+		errors.Is(err, dragonboat.ErrDiskFull) ||
+		errors.Is(err, dragonboat.ErrSessionCapacity) ||
+		errors.Is(err, dragonboat.ErrRateLimited) ||
+		errors.Is(err, dragonboat.ErrLeaderUnknown)
+}
+
+// isAmbiguous returns a boolean value indicating whether a proposal failed
+// with the specified error might have been applied.
+func isAmbiguous(err error) bool {
+	return errors.Is(err, dragonboat.ErrTimeout) ||
+		errors.Is(err, dragonboat.ErrCanceled) ||
+		errors.Is(err, dragonboat.ErrAborted) ||
+		errors.Is(err, dragonboat.ErrShardClosed)
+}
+
+// SyncPropose makes a proposal using dragonboat.Client's SyncPropose method,
+// the proposal is retried according to the specified policy.
+//
+// When cs is a registered client session, ProposalCompleted is invoked once
+// the proposal is completed or once it is known to have not been applied. The
+// session is left unchanged when the outcome is unknown after the last
+// attempt, ErrAmbiguousOutcome is returned and the caller is expected to
+// either retry the proposal later using the same session, which is safe as it
+// is applied at most once, or to call ProposalCompleted to abandon it.
+//
+// The result is returned together with the *dragonboat.SMApplicationError
+// when the state machine reported an application error for the applied
+// proposal, such proposal is never retried.
+//
+// When cs is a NO-OP session, the proposal is not retried once an attempt
+// fails with an unknown outcome, e.g. ErrTimeout, ErrAmbiguousOutcome is
+// returned.
+func SyncPropose(ctx context.Context, c dragonboat.Client,
+	cs *client.Session, cmd []byte, policy Policy) (sm.Result, error) {
+	ambiguous := false
+	attempts := 0
+	for {
+		attempts++
+		actx, cancel := policy.attemptContext(ctx)
+		result, err := c.SyncPropose(actx, cs, cmd)
+		cancel()
+		// proposals failed with an application error have been applied
+		if err == nil || errors.Is(err, dragonboat.ErrSMApplication) {
+			policy.Budget.deposit()
+			if !cs.IsNoOPSession() {
+				cs.ProposalCompleted()
+			}
+			return result, err
+		}
+		ambiguous = ambiguous || isAmbiguous(err)
+		if cs.IsNoOPSession() && ambiguous {
+			return sm.Result{}, ambiguousError(err, attempts)
+		}
+		if err := policy.wait(ctx, err, attempts); err != nil {
+			if ambiguous {
+				return sm.Result{}, ambiguousError(err, attempts)
+			}
+			if !cs.IsNoOPSession() &&
+				!errors.Is(err, dragonboat.ErrInvalidSession) {
+				cs.ProposalCompleted()
+			}
+			return sm.Result{}, err
+		}
+	}
+}
+
+// SyncRead performs a linearizable read using dragonboat.Client's SyncRead
+// method, the read is retried according to the specified policy.
+func SyncRead(ctx context.Context, c dragonboat.Client,
+	shardID uint64, query interface{}, policy Policy) (interface{}, error) {
+	attempts := 0
+	for {
+		attempts++
+		actx, cancel := policy.attemptContext(ctx)
+		result, err := c.SyncRead(actx, shardID, query)
+		cancel()
+		if err == nil {
+			policy.Budget.deposit()
+			return result, nil
+		}
+		if err := policy.wait(ctx, err, attempts); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func ambiguousError(err error, attempts int) error {
+	return errors.Mark(errors.Wrapf(err,
+		"outcome unknown after %d attempts", attempts), ErrAmbiguousOutcome)
+}
+
+func (p Policy) attemptContext(ctx context.Context) (context.Context,
+	context.CancelFunc) {
+	if p.AttemptTimeout == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, p.AttemptTimeout)
+}
+
+// wait waits for the delay before the next attempt, the error to be returned
+// to the caller is returned when the request is not going to be retried.
+func (p Policy) wait(ctx context.Context, err error, attempts int) error {
+	if !IsRetryable(err) || ctx.Err() != nil {
+		return err
+	}
+	delay, ok := p.next(attempts)
+	if !ok {
+		return err
+	}
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return err
+	}
+}
@@ -0,0 +1,432 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/plugin/clientmock"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+var errorTests = []struct {
+	name      string
+	err       error
+	retryable bool
+}{
+	{"ErrAborted", dragonboat.ErrAborted, true},
+	{"ErrAddressInUse", dragonboat.ErrAddressInUse, false},
+	{"ErrApplyStalled", dragonboat.ErrApplyStalled, false},
+	{"ErrBootstrapMismatch", dragonboat.ErrBootstrapMismatch, false},
+	{"ErrCanceled", dragonboat.ErrCanceled, false},
+	{"ErrCheckpointDirExists", dragonboat.ErrCheckpointDirExists, false},
+	{"ErrCheckpointNotSupported", dragonboat.ErrCheckpointNotSupported, false},
+	{"ErrCheckpointTimeout", dragonboat.ErrCheckpointTimeout, false},
+	{"ErrChunksUnavailable", dragonboat.ErrChunksUnavailable, false},
+	{"ErrClosed", dragonboat.ErrClosed, false},
+	{"ErrCollocatedWitness", dragonboat.ErrCollocatedWitness, false},
+	{"ErrDeadlineNotSet", dragonboat.ErrDeadlineNotSet, false},
+	{"ErrDirNotExist", dragonboat.ErrDirNotExist, false},
+	{"ErrDirectoryLocked", dragonboat.ErrDirectoryLocked, false},
+	{"ErrDiskFull", dragonboat.ErrDiskFull, true},
+	{"ErrFenceExpired", dragonboat.ErrFenceExpired, false},
+	{"ErrFingerprintMismatch", dragonboat.ErrFingerprintMismatch, false},
+	{"ErrFingerprintNotFound", dragonboat.ErrFingerprintNotFound, false},
+	{"ErrFsyncNotDurable", dragonboat.ErrFsyncNotDurable, false},
+	{"ErrGossipJoinFailed", dragonboat.ErrGossipJoinFailed, false},
+	{"ErrInsufficientDiskSpace", dragonboat.ErrInsufficientDiskSpace, false},
+	{"ErrInvalidAddress", dragonboat.ErrInvalidAddress, false},
+	{"ErrInvalidDeadline", dragonboat.ErrInvalidDeadline, false},
+	{"ErrInvalidGossipKey", dragonboat.ErrInvalidGossipKey, false},
+	{"ErrInvalidOperation", dragonboat.ErrInvalidOperation, false},
+	{"ErrInvalidOption", dragonboat.ErrInvalidOption, false},
+	{"ErrInvalidRange", dragonboat.ErrInvalidRange, false},
+	{"ErrInvalidSession", dragonboat.ErrInvalidSession, false},
+	{"ErrInvalidShardSettings", dragonboat.ErrInvalidShardSettings, false},
+	{"ErrInvalidSnapshotArchive", dragonboat.ErrInvalidSnapshotArchive, false},
+	{"ErrInvalidTarget", dragonboat.ErrInvalidTarget, false},
+	{"ErrLagging", dragonboat.ErrLagging, false},
+	{"ErrLeaderChanged", dragonboat.ErrLeaderChanged, false},
+	{"ErrLeaderUnknown", dragonboat.ErrLeaderUnknown, true},
+	{"ErrLogCompacted", dragonboat.ErrLogCompacted, false},
+	{"ErrLogDBNotCreatedOrClosed", dragonboat.ErrLogDBNotCreatedOrClosed, false},
+	{"ErrMembershipTooLarge", dragonboat.ErrMembershipTooLarge, false},
+	{"ErrNoSnapshot", dragonboat.ErrNoSnapshot, false},
+	{"ErrNotDirectory", dragonboat.ErrNotDirectory, false},
+	{"ErrNotLeader", dragonboat.ErrNotLeader, false},
+	{"ErrPayloadTooBig", dragonboat.ErrPayloadTooBig, false},
+	{"ErrPurgeNotConfirmed", dragonboat.ErrPurgeNotConfirmed, false},
+	{"ErrRateLimited", dragonboat.ErrRateLimited, true},
+	{"ErrReadOnlyNodeHost", dragonboat.ErrReadOnlyNodeHost, false},
+	{"ErrReadOnlyReplicaOpen", dragonboat.ErrReadOnlyReplicaOpen, false},
+	{"ErrRejected", dragonboat.ErrRejected, false},
+	{"ErrReplicaIDReused", dragonboat.ErrReplicaIDReused, false},
+	{"ErrReplicaRemoved", dragonboat.ErrReplicaRemoved, false},
+	{"ErrReplicaStateExist", dragonboat.ErrReplicaStateExist, false},
+	{"ErrResourceGroupInUse", dragonboat.ErrResourceGroupInUse, false},
+	{"ErrResourceGroupMismatch", dragonboat.ErrResourceGroupMismatch, false},
+	{"ErrSMApplication", dragonboat.ErrSMApplication, false},
+	{"ErrSessionCapacity", dragonboat.ErrSessionCapacity, true},
+	{"ErrShardAlreadyExist", dragonboat.ErrShardAlreadyExist, false},
+	{"ErrShardClosed", dragonboat.ErrShardClosed, false},
+	{"ErrShardFrozen", dragonboat.ErrShardFrozen, false},
+	{"ErrShardNotBootstrapped", dragonboat.ErrShardNotBootstrapped, false},
+	{"ErrShardNotFound", dragonboat.ErrShardNotFound, false},
+	{"ErrShardNotInitialized", dragonboat.ErrShardNotInitialized, true},
+	{"ErrShardNotReady", dragonboat.ErrShardNotReady, true},
+	{"ErrShardNotStopped", dragonboat.ErrShardNotStopped, false},
+	{"ErrSnapshotNoSpace", dragonboat.ErrSnapshotNoSpace, false},
+	{"ErrSnapshotUnchanged", dragonboat.ErrSnapshotUnchanged, false},
+	{"ErrStalenessBoundExceeded", dragonboat.ErrStalenessBoundExceeded, false},
+	{"ErrStartupAuditFailed", dragonboat.ErrStartupAuditFailed, false},
+	{"ErrSystemBusy", dragonboat.ErrSystemBusy, true},
+	{"ErrTargetIsNonVoting", dragonboat.ErrTargetIsNonVoting, false},
+	{"ErrTargetIsWitness", dragonboat.ErrTargetIsWitness, false},
+	{"ErrTargetLagging", dragonboat.ErrTargetLagging, true},
+	{"ErrTargetNotMember", dragonboat.ErrTargetNotMember, false},
+	{"ErrTimeout", dragonboat.ErrTimeout, true},
+	{"ErrTimeoutTooSmall", dragonboat.ErrTimeoutTooSmall, false},
+	{"ErrTooManyNonVotings", dragonboat.ErrTooManyNonVotings, false},
+	{"ErrTooManyWitnesses", dragonboat.ErrTooManyWitnesses, false},
+	{"ErrUnsafeMembershipChange", dragonboat.ErrUnsafeMembershipChange, false},
+	{"ErrVolatileFilesystem", dragonboat.ErrVolatileFilesystem, false},
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tt := range errorTests {
+		if v := IsRetryable(tt.err); v != tt.retryable {
+			t.Errorf("%s, got %t, want %t", tt.name, v, tt.retryable)
+		}
+		wrapped := errors.Wrapf(tt.err, "wrapped")
+		if v := IsRetryable(wrapped); v != tt.retryable {
+			t.Errorf("wrapped %s, got %t, want %t", tt.name, v, tt.retryable)
+		}
+	}
+	if IsRetryable(ErrAmbiguousOutcome) || IsRetryable(nil) {
+		t.Errorf("unexpected retryable error")
+	}
+}
+
+// TestAllErrorsAreClassified checks that errorTests covers all exported
+// errors of the dragonboat package.
+func TestAllErrorsAreClassified(t *testing.T) {
+	fset := token.NewFileSet()
+	filter := func(fi fs.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}
+	pkgs, err := parser.ParseDir(fset, "..", filter, 0)
+	if err != nil {
+		t.Fatalf("failed to parse the dragonboat package %v", err)
+	}
+	classified := make(map[string]struct{})
+	for _, tt := range errorTests {
+		classified[tt.name] = struct{}{}
+	}
+	count := 0
+	for _, f := range pkgs["dragonboat"].Files {
+		for _, decl := range f.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gd.Specs {
+				for _, name := range spec.(*ast.ValueSpec).Names {
+					if !strings.HasPrefix(name.Name, "Err") || !name.IsExported() {
+						continue
+					}
+					count++
+					if _, ok := classified[name.Name]; !ok {
+						t.Errorf("%s not classified", name.Name)
+					}
+				}
+			}
+		}
+	}
+	if count != len(errorTests) {
+		t.Errorf("%d errors, %d classified", count, len(errorTests))
+	}
+}
+
+func getTestPolicy() Policy {
+	return Policy{
+		MaxAttempts:    5,
+		AttemptTimeout: time.Second,
+		Backoff:        Constant(time.Millisecond),
+	}
+}
+
+func getTestClient() *clientmock.Client {
+	c := clientmock.New()
+	c.SetShard(1, clientmock.Shard{LeaderID: 1, Term: 1})
+	return c
+}
+
+func TestSyncProposeRetriesUsingTheSameSeriesID(t *testing.T) {
+	c := getTestClient()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	cs, err := c.SyncGetSession(ctx, 1)
+	if err != nil {
+		t.Fatalf("failed to get session %v", err)
+	}
+	seriesID := cs.SeriesID
+	c.Fail(clientmock.SyncPropose, 1, 1, dragonboat.ErrTimeout)
+	c.Fail(clientmock.SyncPropose, 1, 2, dragonboat.ErrSystemBusy)
+	result, err := SyncPropose(ctx, c, cs, []byte("test"), getTestPolicy())
+	if err != nil {
+		t.Fatalf("failed to propose %v", err)
+	}
+	if result.Value != 1 {
+		t.Errorf("unexpected result %d", result.Value)
+	}
+	calls := c.CallsTo(clientmock.SyncPropose)
+	if len(calls) != 3 {
+		t.Fatalf("unexpected calls %v", calls)
+	}
+	for _, call := range calls {
+		if call.SeriesID != seriesID {
+			t.Errorf("series ID %d, want %d", call.SeriesID, seriesID)
+		}
+	}
+	if cs.SeriesID != seriesID+1 || cs.RespondedTo != seriesID {
+		t.Errorf("proposal not completed, %+v", cs)
+	}
+}
+
+func TestSyncProposeFailedRegisteredSessionProposal(t *testing.T) {
+	tests := []struct {
+		errs      []error
+		ambiguous bool
+	}{
+		{[]error{dragonboat.ErrRejected}, false},
+		{[]error{dragonboat.ErrSystemBusy, dragonboat.ErrPayloadTooBig}, false},
+		{[]error{dragonboat.ErrShardNotReady, dragonboat.ErrShardNotReady}, false},
+		{[]error{dragonboat.ErrTimeout, dragonboat.ErrTimeout}, true},
+		{[]error{dragonboat.ErrTimeout, dragonboat.ErrShardNotFound}, true},
+		{[]error{dragonboat.ErrShardClosed}, true},
+	}
+	for idx, tt := range tests {
+		c := getTestClient()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		cs, err := c.SyncGetSession(ctx, 1)
+		if err != nil {
+			t.Fatalf("failed to get session %v", err)
+		}
+		for i, err := range tt.errs {
+			c.Fail(clientmock.SyncPropose, 1, i+1, err)
+		}
+		seriesID := cs.SeriesID
+		p := getTestPolicy()
+		p.MaxAttempts = 2
+		_, err = SyncPropose(ctx, c, cs, []byte("test"), p)
+		cancel()
+		last := tt.errs[len(tt.errs)-1]
+		if !errors.Is(err, last) {
+			t.Errorf("%d, unexpected error %v", idx, err)
+		}
+		if errors.Is(err, ErrAmbiguousOutcome) != tt.ambiguous {
+			t.Errorf("%d, unexpected error %v", idx, err)
+		}
+		if tt.ambiguous && cs.SeriesID != seriesID {
+			t.Errorf("%d, session changed on ambiguous outcome", idx)
+		}
+		if !tt.ambiguous && cs.SeriesID != seriesID+1 {
+			t.Errorf("%d, failed proposal not completed", idx)
+		}
+		if n := len(c.CallsTo(clientmock.SyncPropose)); n != len(tt.errs) {
+			t.Errorf("%d, %d attempts, want %d", idx, n, len(tt.errs))
+		}
+	}
+}
+
+func TestSyncProposeApplicationErrorIsNotRetried(t *testing.T) {
+	c := getTestClient()
+	c.SetShard(1, clientmock.Shard{
+		LeaderID: 1,
+		Term:     1,
+		Propose: func(cmd []byte) (sm.Result, error) {
+			return sm.Result{Value: 2}, &dragonboat.SMApplicationError{
+				ShardID: 1, Code: 3, Message: "conflict"}
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	cs, err := c.SyncGetSession(ctx, 1)
+	if err != nil {
+		t.Fatalf("failed to get session %v", err)
+	}
+	seriesID := cs.SeriesID
+	result, err := SyncPropose(ctx, c, cs, []byte("test"), getTestPolicy())
+	var ae *dragonboat.SMApplicationError
+	if !errors.As(err, &ae) || ae.Code != 3 {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if result.Value != 2 {
+		t.Errorf("unexpected result %d", result.Value)
+	}
+	if n := len(c.CallsTo(clientmock.SyncPropose)); n != 1 {
+		t.Errorf("%d attempts, want 1", n)
+	}
+	if cs.SeriesID != seriesID+1 {
+		t.Errorf("proposal not completed")
+	}
+}
+
+func TestSyncProposeNoOPSessionIsNotRetriedOnAmbiguousOutcome(t *testing.T) {
+	c := getTestClient()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	cs := c.GetNoOPSession(1)
+	c.Fail(clientmock.SyncPropose, 1, 1, dragonboat.ErrSystemBusy)
+	c.Fail(clientmock.SyncPropose, 1, 2, dragonboat.ErrTimeout)
+	_, err := SyncPropose(ctx, c, cs, []byte("test"), getTestPolicy())
+	if !errors.Is(err, ErrAmbiguousOutcome) || !errors.Is(err, dragonboat.ErrTimeout) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if n := len(c.CallsTo(clientmock.SyncPropose)); n != 2 {
+		t.Errorf("%d attempts, want 2", n)
+	}
+	if _, err := SyncPropose(ctx, c, cs, []byte("test"), getTestPolicy()); err != nil {
+		t.Errorf("failed to propose %v", err)
+	}
+}
+
+func TestSyncReadIsRetried(t *testing.T) {
+	c := getTestClient()
+	c.SetShard(1, clientmock.Shard{
+		Read: func(query interface{}) (interface{}, error) {
+			return query, nil
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c.Fail(clientmock.SyncRead, 1, 1, dragonboat.ErrTimeout)
+	c.Fail(clientmock.SyncRead, 1, 2, dragonboat.ErrShardNotReady)
+	v, err := SyncRead(ctx, c, 1, "query", getTestPolicy())
+	if err != nil {
+		t.Fatalf("failed to read %v", err)
+	}
+	if v.(string) != "query" {
+		t.Errorf("unexpected result %v", v)
+	}
+	if _, err := SyncRead(ctx, c, 2, "query",
+		getTestPolicy()); !errors.Is(err, dragonboat.ErrShardNotFound) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if n := len(c.CallsTo(clientmock.SyncRead)); n != 4 {
+		t.Errorf("%d attempts, want 4", n)
+	}
+}
+
+func TestMaxAttemptsIsRespected(t *testing.T) {
+	c := getTestClient()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 1; i <= 10; i++ {
+		c.Fail(clientmock.SyncRead, 1, i, dragonboat.ErrSystemBusy)
+	}
+	p := getTestPolicy()
+	p.MaxAttempts = 3
+	if _, err := SyncRead(ctx, c, 1, nil, p); !errors.Is(err, dragonboat.ErrSystemBusy) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if n := len(c.CallsTo(clientmock.SyncRead)); n != 3 {
+		t.Errorf("%d attempts, want 3", n)
+	}
+}
+
+func TestContextLimitsRetries(t *testing.T) {
+	c := getTestClient()
+	for i := 1; i <= 10; i++ {
+		c.Fail(clientmock.SyncRead, 1, i, dragonboat.ErrSystemBusy)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	p := getTestPolicy()
+	p.MaxAttempts = 0
+	p.Backoff = Constant(time.Second)
+	if _, err := SyncRead(ctx, c, 1, nil, p); !errors.Is(err, dragonboat.ErrSystemBusy) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if n := len(c.CallsTo(clientmock.SyncRead)); n != 1 {
+		t.Errorf("%d attempts, want 1", n)
+	}
+}
+
+func TestBudgetLimitsRetries(t *testing.T) {
+	c := getTestClient()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	p := getTestPolicy()
+	p.MaxAttempts = 0
+	p.Budget = NewBudget(2, 0.5)
+	for i := 1; i <= 4; i++ {
+		c.Fail(clientmock.SyncRead, 1, i, dragonboat.ErrSystemBusy)
+	}
+	// 2 retries allowed by the budget
+	if _, err := SyncRead(ctx, c, 1, nil, p); !errors.Is(err, dragonboat.ErrSystemBusy) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if n := len(c.CallsTo(clientmock.SyncRead)); n != 3 {
+		t.Errorf("%d attempts, want 3", n)
+	}
+	if v := p.Budget.Tokens(); v != 0 {
+		t.Errorf("unexpected tokens %f", v)
+	}
+	// successful calls deposit tokens back
+	for i := 0; i < 4; i++ {
+		if _, err := SyncRead(ctx, c, 1, nil, p); err != nil && i > 0 {
+			t.Fatalf("failed to read %v", err)
+		}
+	}
+	if v := p.Budget.Tokens(); v != 1.5 {
+		t.Errorf("unexpected tokens %f", v)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := SyncRead(ctx, c, 1, nil, p); err != nil {
+			t.Fatalf("failed to read %v", err)
+		}
+	}
+	if v := p.Budget.Tokens(); v != 2 {
+		t.Errorf("tokens %f, want 2", v)
+	}
+}
+
+func TestExponentialDelay(t *testing.T) {
+	e := Exponential{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	expected := []time.Duration{10, 20, 40, 50, 50}
+	for i, v := range expected {
+		if d := e.Delay(i + 1); d != v*time.Millisecond {
+			t.Errorf("retry %d, delay %s, want %s", i+1, d, v*time.Millisecond)
+		}
+	}
+	e.Multiplier = 3
+	e.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := e.Delay(2); d > 30*time.Millisecond || d < 15*time.Millisecond {
+			t.Fatalf("unexpected delay %s", d)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
+)
+
+const (
+	// SlowOpStatsWindow is the length of the rolling window of the slow
+	// operation counts returned by NodeHost.GetSMStats.
+	SlowOpStatsWindow = 10 * time.Minute
+	slowOpBuckets     = 10
+	slowOpBucketSize  = SlowOpStatsWindow / slowOpBuckets
+)
+
+var (
+	// slowOpEventInterval is the minimum interval between two events of the
+	// same kind reported for the same replica.
+	slowOpEventInterval = 10 * time.Second
+)
+
+type slowOpKind int
+
+const (
+	slowUpdate slowOpKind = iota
+	slowLookup
+	slowSaveSnapshot
+	slowDiskSave
+	numSlowOpKinds
+)
+
+var slowOpCallbackNames = [...]string{
+	slowUpdate:       "Update",
+	slowLookup:       "Lookup",
+	slowSaveSnapshot: "SaveSnapshot",
+}
+
+// SMStats contains the numbers of slow operations observed by a replica in
+// the last SlowOpStatsWindow. Slow operations are the ones exceeding the
+// NodeHostConfig.SlowSMThreshold or NodeHostConfig.SlowDiskThreshold values.
+type SMStats struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// SlowUpdate is the number of slow Update invocations.
+	SlowUpdate uint64
+	// SlowLookup is the number of slow Lookup invocations.
+	SlowLookup uint64
+	// SlowSaveSnapshot is the number of slow SaveSnapshot invocations.
+	SlowSaveSnapshot uint64
+	// SlowDisk is the number of slow LogDB saves that included the replica.
+	SlowDisk uint64
+}
+
+// rollingCounter counts events in the last SlowOpStatsWindow using fixed size
+// buckets.
+type rollingCounter struct {
+	counts [slowOpBuckets]uint64
+	epochs [slowOpBuckets]int64
+}
+
+func (c *rollingCounter) add(now time.Time) {
+	epoch := now.UnixNano() / int64(slowOpBucketSize)
+	idx := epoch % slowOpBuckets
+	if c.epochs[idx] != epoch {
+		c.epochs[idx] = epoch
+		c.counts[idx] = 0
+	}
+	c.counts[idx]++
+}
+
+func (c *rollingCounter) get(now time.Time) uint64 {
+	epoch := now.UnixNano() / int64(slowOpBucketSize)
+	total := uint64(0)
+	for idx, e := range c.epochs {
+		if e > epoch-slowOpBuckets && e <= epoch {
+			total += c.counts[idx]
+		}
+	}
+	return total
+}
+
+// slowOpDetector reports slow state machine invocations and slow LogDB saves
+// of a replica as system events. Events of each kind are rate limited, all
+// slow operations are counted. All methods can be invoked on a nil
+// slowOpDetector, nothing is recorded in that case.
+type slowOpDetector struct {
+	mu            sync.Mutex
+	sysEvents     *sysEventListener
+	shardID       uint64
+	replicaID     uint64
+	smThreshold   time.Duration
+	diskThreshold time.Duration
+	lastEvents    [numSlowOpKinds]time.Time
+	counters      [numSlowOpKinds]rollingCounter
+}
+
+// newSlowOpDetector returns the detector of the specified replica, nil is
+// returned when neither threshold is set.
+func newSlowOpDetector(cfg config.Config, nhConfig config.NodeHostConfig,
+	sysEvents *sysEventListener) *slowOpDetector {
+	if nhConfig.SlowSMThreshold == 0 && nhConfig.SlowDiskThreshold == 0 {
+		return nil
+	}
+	return &slowOpDetector{
+		sysEvents:     sysEvents,
+		shardID:       cfg.ShardID,
+		replicaID:     cfg.ReplicaID,
+		smThreshold:   nhConfig.SlowSMThreshold,
+		diskThreshold: nhConfig.SlowDiskThreshold,
+	}
+}
+
+// smStarted returns the start time of a state machine invocation, the zero
+// time is returned when slow state machine detection is disabled.
+func (d *slowOpDetector) smStarted() time.Time {
+	if d == nil || d.smThreshold == 0 {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// smDone checks whether the state machine invocation started at the specified
+// time is slow.
+func (d *slowOpDetector) smDone(kind slowOpKind, start time.Time, index uint64) {
+	if elapsed, slow := d.smSlow(start); slow {
+		d.record(kind, elapsed, index, nil)
+	}
+}
+
+// updateDone checks whether the Update invocation started at the specified
+// time is slow, the request ID of the last applied entry is reported for slow
+// invocations.
+func (d *slowOpDetector) updateDone(start time.Time,
+	index uint64, ts []rsm.Task) {
+	if elapsed, slow := d.smSlow(start); slow {
+		d.record(slowUpdate, elapsed, index, getRequestIDOfEntry(ts, index))
+	}
+}
+
+// smSlow returns the time spent in the state machine invocation started at
+// the specified time and whether it is slow.
+func (d *slowOpDetector) smSlow(start time.Time) (time.Duration, bool) {
+	if d == nil || start.IsZero() {
+		return 0, false
+	}
+	elapsed := time.Since(start)
+	return elapsed, elapsed > d.smThreshold
+}
+
+func getRequestIDOfEntry(ts []rsm.Task, index uint64) []byte {
+	for _, t := range ts {
+		for _, e := range t.Entries {
+			if e.Index == index {
+				return e.RequestID
+			}
+		}
+	}
+	return nil
+}
+
+// diskSaved checks whether the LogDB save of the specified duration is slow.
+func (d *slowOpDetector) diskSaved(elapsed time.Duration) {
+	if d != nil && d.diskThreshold > 0 && elapsed > d.diskThreshold {
+		d.record(slowDiskSave, elapsed, 0, nil)
+	}
+}
+
+func (d *slowOpDetector) record(kind slowOpKind,
+	elapsed time.Duration, index uint64, requestID []byte) {
+	now := time.Now()
+	d.mu.Lock()
+	d.counters[kind].add(now)
+	report := d.lastEvents[kind].IsZero() ||
+		now.Sub(d.lastEvents[kind]) >= slowOpEventInterval
+	if report {
+		d.lastEvents[kind] = now
+	}
+	d.mu.Unlock()
+	if !report {
+		return
+	}
+	if kind == slowDiskSave {
+		plog.Warningf("%s slow LogDB save, took %s",
+			dn(d.shardID, d.replicaID), elapsed)
+		d.sysEvents.Publish(server.SystemEvent{
+			Type:      server.SlowDisk,
+			ShardID:   d.shardID,
+			ReplicaID: d.replicaID,
+			Duration:  elapsed,
+		})
+		return
+	}
+	name := slowOpCallbackNames[kind]
+	if len(requestID) > 0 {
+		plog.Warningf("%s slow %s, took %s, index %d, request ID %x",
+			dn(d.shardID, d.replicaID), name, elapsed, index, requestID)
+	} else {
+		plog.Warningf("%s slow %s, took %s, index %d",
+			dn(d.shardID, d.replicaID), name, elapsed, index)
+	}
+	d.sysEvents.Publish(server.SystemEvent{
+		Type:      server.SlowStateMachine,
+		ShardID:   d.shardID,
+		ReplicaID: d.replicaID,
+		Callback:  name,
+		Index:     index,
+		Duration:  elapsed,
+		RequestID: requestID,
+	})
+}
+
+func (d *slowOpDetector) stats() SMStats {
+	if d == nil {
+		return SMStats{}
+	}
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return SMStats{
+		SlowUpdate:       d.counters[slowUpdate].get(now),
+		SlowLookup:       d.counters[slowLookup].get(now),
+		SlowSaveSnapshot: d.counters[slowSaveSnapshot].get(now),
+		SlowDisk:         d.counters[slowDiskSave].get(now),
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+const (
+	slowTestThreshold = 50 * time.Millisecond
+	slowTestDelay     = 100 * time.Millisecond
+)
+
+// slowTestSM is a state machine with artificially slow Update, Lookup and
+// SaveSnapshot methods when slow is set.
+type slowTestSM struct {
+	slow *int32
+}
+
+func (s *slowTestSM) delay() {
+	if atomic.LoadInt32(s.slow) == 1 {
+		time.Sleep(slowTestDelay)
+	}
+}
+
+func (s *slowTestSM) Update(e sm.Entry) (sm.Result, error) {
+	s.delay()
+	return sm.Result{Value: uint64(len(e.Cmd))}, nil
+}
+
+func (s *slowTestSM) Lookup(query interface{}) (interface{}, error) {
+	s.delay()
+	return query, nil
+}
+
+func (s *slowTestSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	s.delay()
+	_, err := w.Write([]byte("data"))
+	return err
+}
+
+func (s *slowTestSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	_, err := io.ReadAll(r)
+	return err
+}
+
+func (s *slowTestSM) Close() error { return nil }
+
+// slowSyncInjector is a vfs injector that slows down fsync when slow is set.
+// Each fsync takes delay, or slowTestDelay when delay is not set.
+type slowSyncInjector struct {
+	slow  int32
+	delay time.Duration
+}
+
+func (s *slowSyncInjector) MaybeError(op vfs.Op) error {
+	if op == vfs.OpSync && atomic.LoadInt32(&s.slow) == 1 {
+		if s.delay > 0 {
+			time.Sleep(s.delay)
+		} else {
+			time.Sleep(slowTestDelay)
+		}
+	}
+	return nil
+}
+
+func getSysEventListener(t *testing.T, nh *NodeHost) *testSysEventListener {
+	listener, ok := nh.events.sys.ul.(*testSysEventListener)
+	if !ok {
+		t.Fatalf("failed to get the system event listener")
+	}
+	return listener
+}
+
+func TestSlowStateMachineIsReported(t *testing.T) {
+	fs := vfs.GetTestFS()
+	slow := int32(0)
+	to := &testOption{
+		updateNodeHostConfig: func(nhc *config.NodeHostConfig) *config.NodeHostConfig {
+			nhc.SlowSMThreshold = slowTestThreshold
+			return nhc
+		},
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &slowTestSM{slow: &slow}
+		},
+		tf: func(nh *NodeHost) {
+			listener := getSysEventListener(t, nh)
+			makeProposals(nh)
+			if len(listener.getSlowStateMachine()) != 0 {
+				t.Fatalf("unexpected slow state machine event")
+			}
+			atomic.StoreInt32(&slow, 1)
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			session := nh.GetNoOPSession(1)
+			// the second slow Update is counted but not reported
+			for i := 0; i < 2; i++ {
+				if _, err := nh.SyncPropose(ctx, session, []byte("test-data")); err != nil {
+					t.Fatalf("failed to make proposal, %v", err)
+				}
+			}
+			if _, err := nh.SyncRead(ctx, 1, nil); err != nil {
+				t.Fatalf("failed to read, %v", err)
+			}
+			if _, err := nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption); err != nil {
+				t.Fatalf("failed to request snapshot, %v", err)
+			}
+			atomic.StoreInt32(&slow, 0)
+			var events []raftio.SlowStateMachineInfo
+			for i := 0; i < 100; i++ {
+				if events = listener.getSlowStateMachine(); len(events) == 3 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if len(events) != 3 {
+				t.Fatalf("unexpected events %+v", events)
+			}
+			callbacks := make(map[string]raftio.SlowStateMachineInfo)
+			for _, e := range events {
+				if e.ShardID != 1 || e.ReplicaID != 1 || e.Duration < slowTestDelay {
+					t.Errorf("unexpected event %+v", e)
+				}
+				callbacks[e.Callback] = e
+			}
+			for _, name := range []string{"Update", "Lookup", "SaveSnapshot"} {
+				if _, ok := callbacks[name]; !ok {
+					t.Errorf("%s not reported", name)
+				}
+			}
+			if callbacks["Update"].Index == 0 {
+				t.Errorf("index not set")
+			}
+			stats, err := nh.GetSMStats(1)
+			if err != nil {
+				t.Fatalf("failed to get stats, %v", err)
+			}
+			if stats.ShardID != 1 || stats.SlowUpdate != 2 ||
+				stats.SlowLookup != 1 || stats.SlowSaveSnapshot != 1 ||
+				stats.SlowDisk != 0 {
+				t.Errorf("unexpected stats %+v", stats)
+			}
+			if _, err := nh.GetSMStats(2); err != ErrShardNotFound {
+				t.Errorf("unexpected error %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestSlowDiskIsReported(t *testing.T) {
+	inj := &slowSyncInjector{}
+	fs := vfs.Wrap(vfs.GetTestFS(), inj)
+	to := &testOption{
+		defaultTestNode: true,
+		updateNodeHostConfig: func(nhc *config.NodeHostConfig) *config.NodeHostConfig {
+			nhc.SlowDiskThreshold = slowTestThreshold
+			return nhc
+		},
+		tf: func(nh *NodeHost) {
+			listener := getSysEventListener(t, nh)
+			atomic.StoreInt32(&inj.slow, 1)
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			session := nh.GetNoOPSession(1)
+			if _, err := nh.SyncPropose(ctx, session, []byte("test-data")); err != nil {
+				t.Fatalf("failed to make proposal, %v", err)
+			}
+			atomic.StoreInt32(&inj.slow, 0)
+			var events []raftio.SlowDiskInfo
+			for i := 0; i < 100; i++ {
+				if events = listener.getSlowDisk(); len(events) > 0 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if len(events) != 1 {
+				t.Fatalf("unexpected events %+v", events)
+			}
+			if events[0].ShardID != 1 || events[0].Duration < slowTestDelay {
+				t.Errorf("unexpected event %+v", events[0])
+			}
+			stats, err := nh.GetSMStats(1)
+			if err != nil {
+				t.Fatalf("failed to get stats, %v", err)
+			}
+			if stats.SlowDisk == 0 || stats.SlowUpdate != 0 {
+				t.Errorf("unexpected stats %+v", stats)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestRollingCounterDropsExpiredBuckets(t *testing.T) {
+	c := &rollingCounter{}
+	now := time.Now()
+	c.add(now)
+	c.add(now)
+	c.add(now.Add(slowOpBucketSize))
+	if v := c.get(now.Add(slowOpBucketSize)); v != 3 {
+		t.Errorf("unexpected count %d", v)
+	}
+	if v := c.get(now.Add(SlowOpStatsWindow)); v != 1 {
+		t.Errorf("unexpected count %d", v)
+	}
+	if v := c.get(now.Add(SlowOpStatsWindow + slowOpBucketSize)); v != 0 {
+		t.Errorf("unexpected count %d", v)
+	}
+}
+
+func TestSlowUpdateReportsRequestID(t *testing.T) {
+	sysEvents := newSysEventListener(&testSysEventListener{}, 0)
+	nhConfig := config.NodeHostConfig{SlowSMThreshold: time.Millisecond}
+	d := newSlowOpDetector(config.Config{ShardID: 1, ReplicaID: 2},
+		nhConfig, sysEvents)
+	ts := []rsm.Task{
+		{Entries: []pb.Entry{{Index: 1, RequestID: []byte("id-1")}}},
+		{Entries: []pb.Entry{{Index: 2, RequestID: []byte("id-2")}, {Index: 3}}},
+	}
+	d.updateDone(time.Now().Add(-time.Second), 2, ts)
+	e, ok := sysEvents.getEvent()
+	if !ok {
+		t.Fatalf("slow Update not reported")
+	}
+	info := getSlowStateMachineInfo(e)
+	if info.Callback != "Update" || info.Index != 2 ||
+		string(info.RequestID) != "id-2" {
+		t.Errorf("unexpected event %+v", info)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// SnapshotResult is the metadata of a snapshot created by a snapshot request.
+type SnapshotResult struct {
+	// Index is the index of the snapshot.
+	Index uint64
+	// Term is the term of the snapshot.
+	Term uint64
+	// Size is the total size in bytes of the snapshot payload, including the
+	// snapshot file and all external files included in the snapshot.
+	Size uint64
+	// FileCount is the number of files of the snapshot, it is the snapshot file
+	// plus all external files included in the snapshot.
+	FileCount uint64
+	// OnDisk indicates whether the snapshot is from an on disk state machine.
+	// Snapshots of on disk state machines that are not exported only contain
+	// metadata.
+	OnDisk bool
+	// CompressionType is the compression type of the snapshot payload.
+	CompressionType config.CompressionType
+	// Deduplicated indicates that no new snapshot was created for the request,
+	// the result is for an identical snapshot exported by another leader only
+	// export request.
+	Deduplicated bool
+	// Locator is the path of the exported snapshot directory. It is empty for
+	// snapshots that are not exported and for snapshots exported to an
+	// ExportSink.
+	Locator string
+	// Fingerprint is the state machine fingerprint recorded in the snapshot, it
+	// is 0 when the state machine does not implement statemachine.IFingerprint.
+	Fingerprint uint64
+}
+
+// SyncRequestSnapshotWithResult is the same as SyncRequestSnapshot but
+// returns the metadata of the created snapshot. When opt.LeaderOnly is set and
+// the export is forwarded to the leader on another NodeHost, only the Index,
+// Term, Deduplicated and Locator fields are available.
+//
+// The input context object must have deadline set.
+func (nh *NodeHost) SyncRequestSnapshotWithResult(ctx context.Context,
+	shardID uint64, opt SnapshotOption) (_ SnapshotResult, err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation:  "SyncRequestSnapshotWithResult",
+		ShardID:    shardID,
+		Parameters: auditParams{"Option": opt},
+	}, time.Now(), &err)
+	if opt.LeaderOnly {
+		_, ss, err := nh.exportSnapshot(ctx, shardID, opt)
+		return ss, err
+	}
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return SnapshotResult{}, err
+	}
+	rs, err := nh.requestSnapshot(shardID, opt, timeout)
+	if err != nil {
+		return SnapshotResult{}, err
+	}
+	r, err := getRequestResult(ctx, rs)
+	if err != nil {
+		return SnapshotResult{}, err
+	}
+	return r.GetSnapshotResult(), nil
+}
+
+// getSnapshotResult returns the metadata of the snapshot saved for the
+// specified request.
+func (n *node) getSnapshotResult(ss pb.Snapshot,
+	req rsm.SSRequest) SnapshotResult {
+	result := SnapshotResult{
+		Index:           ss.Index,
+		Term:            ss.Term,
+		Size:            ss.FileSize,
+		FileCount:       uint64(len(ss.Files)) + 1,
+		OnDisk:          ss.Type == pb.OnDiskStateMachine,
+		CompressionType: n.config.SnapshotCompressionType,
+		Fingerprint:     ss.Fingerprint,
+	}
+	// dummy snapshots are never compressed
+	if ss.Dummy {
+		result.CompressionType = config.NoCompression
+	}
+	for _, f := range ss.Files {
+		result.Size += f.FileSize
+	}
+	if req.Exported() && req.Sink == nil {
+		result.Locator = n.snapshotter.fs.PathJoin(req.Path,
+			server.GetSnapshotDirName(ss.Index))
+	}
+	return result
+}
@@ -0,0 +1,135 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func requestSnapshotWithResult(nh *NodeHost,
+	opt SnapshotOption) (SnapshotResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+	defer cancel()
+	return nh.SyncRequestSnapshotWithResult(ctx, 1, opt)
+}
+
+func TestSnapshotResultIsReturned(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &snapshotWriteTestSM{size: 4096}
+		},
+		compressed: true,
+		tf: func(nh *NodeHost) {
+			makeProposals(nh)
+			result, err := requestSnapshotWithResult(nh, SnapshotOption{})
+			if err != nil {
+				t.Fatalf("failed to request snapshot %v", err)
+			}
+			if result.Index == 0 || result.Term == 0 {
+				t.Errorf("unexpected index/term %+v", result)
+			}
+			if result.Size == 0 || result.FileCount != 1 {
+				t.Errorf("unexpected size/file count %+v", result)
+			}
+			if result.OnDisk || result.CompressionType != config.Snappy {
+				t.Errorf("unexpected type %+v", result)
+			}
+			if result.Deduplicated || result.Locator != "" {
+				t.Errorf("unexpected result %+v", result)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestExportedSnapshotResultIsReturned(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			makeProposals(nh)
+			dir := getLeaderSnapshotExportDir(t, fs, nh)
+			opt := SnapshotOption{
+				Exported:   true,
+				ExportPath: dir,
+				LeaderOnly: true,
+			}
+			first, err := requestSnapshotWithResult(nh, opt)
+			if err != nil {
+				t.Fatalf("failed to export snapshot %v", err)
+			}
+			locator := fs.PathJoin(dir, server.GetSnapshotDirName(first.Index))
+			if first.Locator != locator {
+				t.Errorf("locator %s, want %s", first.Locator, locator)
+			}
+			if _, err := fs.Stat(first.Locator); err != nil {
+				t.Errorf("failed to stat exported snapshot %v", err)
+			}
+			if first.Index == 0 || first.Size == 0 || first.Deduplicated {
+				t.Errorf("unexpected result %+v", first)
+			}
+			second, err := requestSnapshotWithResult(nh, opt)
+			if err != nil {
+				t.Fatalf("failed to export snapshot %v", err)
+			}
+			if !second.Deduplicated || second.Index != first.Index ||
+				second.Locator != first.Locator {
+				t.Errorf("unexpected result %+v, first %+v", second, first)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestSkippedSnapshotResultIsNotReturned(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			makeProposals(nh)
+			dir := getLeaderSnapshotExportDir(t, fs, nh)
+			opt := SnapshotOption{
+				Exported:        true,
+				ExportPath:      dir,
+				SkipIfUnchanged: true,
+			}
+			first, err := requestSnapshotWithResult(nh, opt)
+			if err != nil {
+				t.Fatalf("failed to export snapshot %v", err)
+			}
+			result, err := requestSnapshotWithResult(nh, opt)
+			var sue *SnapshotUnchangedError
+			if !errors.As(err, &sue) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if sue.Index != first.Index {
+				t.Errorf("index %d, want %d", sue.Index, first.Index)
+			}
+			if result != (SnapshotResult{}) {
+				t.Errorf("unexpected result %+v", result)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
@@ -0,0 +1,114 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
+)
+
+// ErrSnapshotNoSpace indicates that a snapshot operation was aborted as the
+// disk ran out of space.
+var ErrSnapshotNoSpace = errors.New("snapshot aborted as no space left")
+
+// SnapshotSpaceError is the error returned to snapshot requests aborted as
+// the disk ran out of space when saving the snapshot, Err is the error
+// reported by the file system. Only the aborted snapshot operation is
+// affected, the snapshot can be requested again once space is available.
+type SnapshotSpaceError struct {
+	Err       error
+	ShardID   uint64
+	ReplicaID uint64
+}
+
+func (e *SnapshotSpaceError) Error() string {
+	return fmt.Sprintf("%s snapshot aborted as no space left: %v",
+		dn(e.ShardID, e.ReplicaID), e.Err)
+}
+
+// Unwrap returns ErrSnapshotNoSpace.
+func (e *SnapshotSpaceError) Unwrap() error {
+	return ErrSnapshotNoSpace
+}
+
+// SnapshotStagingInfo contains the disk space used by snapshot temp
+// directories on the NodeHost, see config.NodeHostConfig.MaxSnapshotStagingBytes
+// for details.
+type SnapshotStagingInfo struct {
+	// Bytes is the number of bytes currently held in temp directories of
+	// snapshots being saved or received.
+	Bytes uint64
+	// Limit is the configured MaxSnapshotStagingBytes value, 0 means unlimited.
+	Limit uint64
+	// Deferred is the total number of snapshot operations deferred as the
+	// limit was reached.
+	Deferred uint64
+}
+
+func (nh *NodeHost) getSnapshotStagingInfo() SnapshotStagingInfo {
+	s := nh.env.GetStagingSpace().Stats()
+	return SnapshotStagingInfo{
+		Bytes:    s.Bytes,
+		Limit:    s.Limit,
+		Deferred: s.Deferred,
+	}
+}
+
+// removeSnapshotTempDirs removes snapshot temp directories left behind by
+// snapshot operations interrupted by crashes.
+func (nh *NodeHost) removeSnapshotTempDirs() error {
+	count, reclaimed, err := nh.env.RemoveSnapshotTempDirs(
+		nh.nhConfig.GetDeploymentID())
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		plog.Infof("removed %d orphaned snapshot temp dirs, %d bytes reclaimed",
+			count, reclaimed)
+	}
+	return nil
+}
+
+// waitForStagingSpace defers the snapshot to be saved until the snapshot
+// staging space is no longer full. It returns false when the replica is
+// stopped while waiting.
+func (n *node) waitForStagingSpace() bool {
+	staging := n.snapshotter.staging
+	if s := staging.Stats(); s.Limit > 0 && s.Bytes >= s.Limit {
+		plog.Infof("%s snapshot deferred, %d bytes staged, limit %d",
+			n.id(), s.Bytes, s.Limit)
+	}
+	return staging.Wait(n.stopC)
+}
+
+// abortNoSpace aborts the snapshot being saved as the disk ran out of space,
+// the requester is notified with a *SnapshotSpaceError.
+func (n *node) abortNoSpace(req rsm.SSRequest, ssenv server.SSEnv, err error) {
+	se := &SnapshotSpaceError{
+		Err:       err,
+		ShardID:   n.shardID,
+		ReplicaID: n.replicaID,
+	}
+	plog.Errorf("%v", se)
+	if err := ssenv.RemoveTempDir(); err != nil {
+		// removed on restart
+		plog.Errorf("%s failed to remove snapshot temp dir, %v", n.id(), err)
+	}
+	n.pendingSnapshot.reject(req.Key, se)
+}
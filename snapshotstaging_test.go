@@ -0,0 +1,206 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// noSpaceFS is a vfs.IFS failing writes made to snapshot image files with
+// ENOSPC once full is set. It is also a vfs injector that never injects errors
+// so it can be wrapped as a vfs.ErrorFS accepted by the LogDB.
+type noSpaceFS struct {
+	vfs.IFS
+	full atomic.Bool
+}
+
+func (fs *noSpaceFS) Create(name string) (vfs.File, error) {
+	f, err := fs.IFS.Create(name)
+	if err != nil || !strings.HasSuffix(name, server.SnapshotFileSuffix) {
+		return f, err
+	}
+	return &noSpaceFile{File: f, fs: fs, name: name}, nil
+}
+
+func (fs *noSpaceFS) MaybeError(op vfs.Op) error {
+	return nil
+}
+
+type noSpaceFile struct {
+	vfs.File
+	fs   *noSpaceFS
+	name string
+}
+
+func (f *noSpaceFile) Write(data []byte) (int, error) {
+	if f.fs.full.Load() {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.ENOSPC}
+	}
+	return f.File.Write(data)
+}
+
+func getSnapshotTempDirs(t *testing.T, nh *NodeHost,
+	shardID uint64, replicaID uint64) []string {
+	dir := nh.env.GetSnapshotDir(nh.nhConfig.GetDeploymentID(),
+		shardID, replicaID)
+	names, err := nh.fs.List(dir)
+	if err != nil {
+		t.Fatalf("failed to list %v", err)
+	}
+	var result []string
+	for _, name := range names {
+		if server.GenSnapshotDirNameRe.MatchString(name) ||
+			server.RecvSnapshotDirNameRe.MatchString(name) {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+func TestSnapshotSaveIsAbortedWhenNoSpaceLeft(t *testing.T) {
+	nfs := &noSpaceFS{IFS: vfs.GetTestFS()}
+	fs := vfs.Wrap(nfs, nfs)
+	to := &testOption{
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &snapshotWriteTestSM{size: 64 * 1024}
+		},
+		tf: func(nh *NodeHost) {
+			makeProposals(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), lpto(nh))
+			defer cancel()
+			nfs.full.Store(true)
+			_, err := nh.SyncRequestSnapshot(ctx, 1, SnapshotOption{})
+			var se *SnapshotSpaceError
+			if !errors.Is(err, ErrSnapshotNoSpace) || !errors.As(err, &se) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if se.ShardID != 1 || !server.IsNoSpace(se.Err) {
+				t.Errorf("unexpected error %+v", se)
+			}
+			if dirs := getSnapshotTempDirs(t, nh, 1, 1); len(dirs) != 0 {
+				t.Errorf("temp dirs not removed, %v", dirs)
+			}
+			info := nh.GetNodeHostInfo(NodeHostInfoOption{SkipLogInfo: true})
+			if info.SnapshotStaging.Bytes != 0 {
+				t.Errorf("unexpected staging info %+v", info.SnapshotStaging)
+			}
+			// snapshots can be saved again once space is available, requests at
+			// the same applied index are ignored
+			nfs.full.Store(false)
+			makeProposals(nh)
+			if _, err := nh.SyncRequestSnapshot(ctx,
+				1, SnapshotOption{}); err != nil {
+				t.Fatalf("failed to request snapshot %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestSnapshotSaveIsDeferredWhenStagingSpaceIsFull(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.MaxSnapshotStagingBytes = 1024
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			makeProposals(nh)
+			// held by another snapshot operation
+			staging := nh.env.GetStagingSpace()
+			staging.Add("other", 1024)
+			rs, err := nh.RequestSnapshot(1, SnapshotOption{}, lpto(nh))
+			if err != nil {
+				t.Fatalf("failed to request snapshot %v", err)
+			}
+			defer rs.Release()
+			select {
+			case <-rs.ResultC():
+				t.Fatalf("snapshot not deferred")
+			case <-time.After(200 * time.Millisecond):
+			}
+			info := nh.GetNodeHostInfo(NodeHostInfoOption{SkipLogInfo: true})
+			if s := info.SnapshotStaging; s.Bytes != 1024 ||
+				s.Limit != 1024 || s.Deferred != 1 {
+				t.Errorf("unexpected staging info %+v", s)
+			}
+			staging.Release("other")
+			select {
+			case r := <-rs.ResultC():
+				if !r.Completed() {
+					t.Errorf("snapshot not completed, %v", r)
+				}
+			case <-time.After(lpto(nh)):
+				t.Fatalf("snapshot not saved")
+			}
+			info = nh.GetNodeHostInfo(NodeHostInfoOption{SkipLogInfo: true})
+			if info.SnapshotStaging.Bytes != 0 {
+				t.Errorf("unexpected staging info %+v", info.SnapshotStaging)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestOrphanedSnapshotTempDirsAreRemovedOnStartup(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		restartNodeHost: true,
+		tf: func(nh *NodeHost) {
+			// temp dirs left behind by a crashed receive of a replica not
+			// started after restart
+			did := nh.nhConfig.GetDeploymentID()
+			if err := nh.env.CreateSnapshotDir(did, 2, 1); err != nil {
+				t.Fatalf("failed to create snapshot dir %v", err)
+			}
+			dir := fs.PathJoin(nh.env.GetSnapshotDir(did, 2, 1),
+				"snapshot-0000000000000010-3.receiving")
+			if err := fs.MkdirAll(dir, 0755); err != nil {
+				t.Fatalf("failed to mkdir %v", err)
+			}
+			f, err := fs.Create(fs.PathJoin(dir, "snapshot.gbsnap"))
+			if err != nil {
+				t.Fatalf("failed to create file %v", err)
+			}
+			if _, err := f.Write(make([]byte, 1024)); err != nil {
+				t.Fatalf("failed to write %v", err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatalf("failed to close %v", err)
+			}
+		},
+		rf: func(nh *NodeHost) {
+			if dirs := getSnapshotTempDirs(t, nh, 2, 1); len(dirs) != 0 {
+				t.Errorf("temp dirs not removed, %v", dirs)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
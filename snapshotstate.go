@@ -67,6 +67,7 @@ type snapshotState struct {
 	reqSnapshotIndex uint64
 	compactLogTo     uint64
 	compactedTo      uint64
+	snapshotTime     int64
 	savingFlag       uint32
 	recoveringFlag   uint32
 	streamingFlag    uint32
@@ -122,6 +123,14 @@ func (rs *snapshotState) getIndex() uint64 {
 	return atomic.LoadUint64(&rs.snapshotIndex)
 }
 
+func (rs *snapshotState) setTime(t int64) {
+	atomic.StoreInt64(&rs.snapshotTime, t)
+}
+
+func (rs *snapshotState) getTime() int64 {
+	return atomic.LoadInt64(&rs.snapshotTime)
+}
+
 func (rs *snapshotState) getReqIndex() uint64 {
 	return atomic.LoadUint64(&rs.reqSnapshotIndex)
 }
@@ -142,6 +151,12 @@ func (rs *snapshotState) setCompactLogTo(v uint64) {
 	atomic.StoreUint64(&rs.compactLogTo, v)
 }
 
+// retryCompactLogTo sets the compactLogTo value when there is no pending one
+// so the deferred compaction is retried.
+func (rs *snapshotState) retryCompactLogTo(v uint64) {
+	atomic.CompareAndSwapUint64(&rs.compactLogTo, 0, v)
+}
+
 func (rs *snapshotState) setCompactedTo(v uint64) {
 	atomic.StoreUint64(&rs.compactedTo, v)
 }
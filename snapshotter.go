@@ -15,7 +15,10 @@
 package dragonboat
 
 import (
+	"io"
+	"path"
 	"strconv"
+	"sync"
 
 	"github.com/cockroachdb/errors"
 	"github.com/lni/goutils/logutil"
@@ -57,14 +60,35 @@ type snapshotter struct {
 	logdb     raftio.ILogDB
 	logReader *logdb.LogReader
 	fs        vfs.IFS
+	// limiter limits the rate of snapshot writes, it is nil when not limited
+	limiter *snapshotWriteLimiter
+	// tenant limits the rate of snapshot writes of the tenant of the shard, it
+	// is nil when the shard has no tenant
+	tenant *snapshotWriteLimiter
+	// staging accounts bytes written to snapshot temp dirs, it can be nil
+	staging *server.StagingSpace
+	// keep is the number of most recent snapshots to keep on disk
+	keep uint64
+	mu   struct {
+		sync.Mutex
+		// released contains indexes of retained older snapshots no longer in use
+		released map[uint64]struct{}
+		// pinned contains the number of pins of snapshots pinned by
+		// ReadAtSnapshot, pinned snapshots are never removed
+		pinned map[uint64]int
+	}
+	retained retainedStats
 }
 
 var _ rsm.ISnapshotter = (*snapshotter)(nil)
 
 func newSnapshotter(shardID uint64, replicaID uint64,
 	root server.SnapshotDirFunc, ldb raftio.ILogDB,
-	logReader *logdb.LogReader, fs vfs.IFS) *snapshotter {
-	return &snapshotter{
+	logReader *logdb.LogReader, fs vfs.IFS, keep uint64) *snapshotter {
+	if keep == 0 {
+		keep = 1
+	}
+	s := &snapshotter{
 		shardID:   shardID,
 		replicaID: replicaID,
 		root:      root,
@@ -72,7 +96,11 @@ func newSnapshotter(shardID uint64, replicaID uint64,
 		logdb:     ldb,
 		logReader: logReader,
 		fs:        fs,
+		keep:      keep,
 	}
+	s.mu.released = make(map[uint64]struct{})
+	s.mu.pinned = make(map[uint64]int)
+	return s
 }
 
 func (s *snapshotter) id() string {
@@ -83,6 +111,12 @@ func (s *snapshotter) ssid(index uint64) string {
 	return logutil.DescribeSS(s.shardID, s.replicaID, index)
 }
 
+// writer returns an io.WriteCloser that writes to w at the rate permitted by
+// both the NodeHost and the tenant limiters.
+func (s *snapshotter) writer(w io.WriteCloser) io.WriteCloser {
+	return s.tenant.writer(s.limiter.writer(w))
+}
+
 func (s *snapshotter) Shrunk(ss pb.Snapshot) (bool, error) {
 	return rsm.IsShrunkSnapshotFile(s.getFilePath(ss.Index), s.fs)
 }
@@ -90,7 +124,7 @@ func (s *snapshotter) Shrunk(ss pb.Snapshot) (bool, error) {
 func (s *snapshotter) Stream(streamable rsm.IStreamable,
 	meta rsm.SSMeta, sink pb.IChunkSink) error {
 	ct := compressionType(meta.CompressionType)
-	cw := dio.NewCompressor(ct, rsm.NewChunkWriter(sink, meta))
+	cw := dio.NewCompressor(ct, s.writer(rsm.NewChunkWriter(sink, meta)))
 	if err := streamable.Stream(meta.Ctx, cw); err != nil {
 		if cerr := sink.Close(); cerr != nil {
 			plog.Errorf("failed to close the sink %v", cerr)
@@ -102,6 +136,10 @@ func (s *snapshotter) Stream(streamable rsm.IStreamable,
 
 func (s *snapshotter) Save(savable rsm.ISavable,
 	meta rsm.SSMeta) (ss pb.Snapshot, env server.SSEnv, err error) {
+	if meta.Request.Sink != nil {
+		ss, err := s.export(savable, meta)
+		return ss, s.getEnv(meta.Index), err
+	}
 	env = s.getCustomEnv(meta)
 	if err := env.CreateTempDir(); err != nil {
 		return pb.Snapshot{}, env, err
@@ -113,7 +151,8 @@ func (s *snapshotter) Save(savable rsm.ISavable,
 	if err != nil {
 		return pb.Snapshot{}, env, err
 	}
-	cw := dio.NewCountedWriter(w)
+	tw := s.staging.Writer(env.GetTempDir(), w)
+	cw := dio.NewCountedWriter(s.writer(tw))
 	sw := dio.NewCompressor(ct, cw)
 	defer func() {
 		err = firstError(err, sw.Close())
@@ -142,9 +181,62 @@ func (s *snapshotter) Save(savable rsm.ISavable,
 		Files:       fs,
 		Dummy:       dummy,
 		Type:        meta.Type,
+		Fingerprint: meta.Fingerprint,
 	}, env, nil
 }
 
+// export saves the exported snapshot directly to the sink specified in the
+// request, no local file is created. Files are named by their slash separated
+// paths relative to the export directory, the layout is the same as snapshots
+// exported to an ExportPath.
+func (s *snapshotter) export(savable rsm.ISavable,
+	meta rsm.SSMeta) (ss pb.Snapshot, err error) {
+	sink := meta.Request.Sink
+	dir := server.GetSnapshotDirName(meta.Index)
+	fn := path.Join(dir, server.GetSnapshotFilename(meta.Index))
+	f, err := sink.CreateFile(fn)
+	if err != nil {
+		return pb.Snapshot{}, err
+	}
+	ct := compressionType(meta.CompressionType)
+	w, err := rsm.NewSnapshotStreamWriter(f, meta.CompressionType)
+	if err != nil {
+		return pb.Snapshot{}, firstError(err, f.Close())
+	}
+	cw := dio.NewCountedWriter(s.writer(w))
+	sw := dio.NewCompressor(ct, cw)
+	defer func() {
+		err = firstError(err, sw.Close())
+		if ss.Index > 0 {
+			total := cw.BytesWritten()
+			ss.Checksum = w.GetPayloadChecksum()
+			ss.FileSize = w.GetPayloadSize(total) + rsm.HeaderSize
+		}
+	}()
+	files := rsm.NewFileCollection()
+	session := meta.Session.Bytes()
+	dummy, err := savable.Save(meta, sw, session, files)
+	if err != nil {
+		return pb.Snapshot{}, err
+	}
+	fs, err := files.ExportFiles(dir, sink)
+	if err != nil {
+		return pb.Snapshot{}, err
+	}
+	return pb.Snapshot{
+		ShardID:     s.shardID,
+		Filepath:    fn,
+		Membership:  meta.Membership,
+		Index:       meta.Index,
+		Term:        meta.Term,
+		OnDiskIndex: meta.OnDiskIndex,
+		Files:       fs,
+		Dummy:       dummy,
+		Type:        meta.Type,
+		Fingerprint: meta.Fingerprint,
+	}, nil
+}
+
 func (s *snapshotter) Load(ss pb.Snapshot,
 	sessions rsm.ILoadable, asm rsm.IRecoverable) (err error) {
 	fp := s.getFilePath(ss.Index)
@@ -228,10 +320,7 @@ func (s *snapshotter) Compact(index uint64) error {
 	}
 	plog.Debugf("%s called Compact, latest %d, to compact %d",
 		s.id(), ss.Index, index)
-	if err := s.remove(index); err != nil {
-		return err
-	}
-	return nil
+	return s.release(index)
 }
 
 func (s *snapshotter) IsNoSnapshotError(err error) bool {
@@ -239,6 +328,9 @@ func (s *snapshotter) IsNoSnapshotError(err error) bool {
 }
 
 func (s *snapshotter) Commit(ss pb.Snapshot, req rsm.SSRequest) error {
+	if req.Sink != nil {
+		return s.commitExport(ss, req.Sink)
+	}
 	env := s.getCustomEnv(rsm.SSMeta{
 		Index:   ss.Index,
 		Request: req,
@@ -257,7 +349,30 @@ func (s *snapshotter) Commit(ss pb.Snapshot, req rsm.SSRequest) error {
 			return err
 		}
 	}
-	return env.RemoveFlagFile()
+	if err := env.RemoveFlagFile(); err != nil {
+		return err
+	}
+	if !req.Exported() {
+		s.updateRetainedStats()
+	}
+	return nil
+}
+
+// commitExport writes the metadata file of the exported snapshot to the sink
+// before committing the sink.
+func (s *snapshotter) commitExport(ss pb.Snapshot, sink rsm.IExportSink) error {
+	dir := server.GetSnapshotDirName(ss.Index)
+	f, err := sink.CreateFile(path.Join(dir, server.MetadataFilename))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(fileutil.MarshalFlagFileContent(&ss)); err != nil {
+		return firstError(err, f.Close())
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return sink.Commit(ss)
 }
 
 func (s *snapshotter) getFilePath(index uint64) string {
@@ -279,6 +394,7 @@ func (s *snapshotter) processOrphans() error {
 			return err
 		}
 	}
+	var older []uint64
 	removeFolder := func(fdir string) error {
 		if err := s.fs.RemoveAll(fdir); err != nil {
 			return err
@@ -327,14 +443,16 @@ func (s *snapshotter) processOrphans() error {
 			}
 		} else if s.isSnapshot(fi.Name()) {
 			index := s.parseIndex(fi.Name())
-			if noss || index != mrss.Index {
+			if !noss && index < mrss.Index {
+				older = append(older, index)
+			} else if noss || index != mrss.Index {
 				if err := removeFolder(fdir); err != nil {
 					return err
 				}
 			}
 		}
 	}
-	return nil
+	return s.retainOlder(older)
 }
 
 func (s *snapshotter) remove(index uint64) error {
@@ -344,7 +462,11 @@ func (s *snapshotter) remove(index uint64) error {
 
 func (s *snapshotter) removeFlagFile(index uint64) error {
 	env := s.getEnv(index)
-	return env.RemoveFlagFile()
+	if err := env.RemoveFlagFile(); err != nil {
+		return err
+	}
+	s.updateRetainedStats()
+	return nil
 }
 
 func (s *snapshotter) getEnv(index uint64) server.SSEnv {
@@ -374,6 +496,36 @@ func (s *snapshotter) saveSnapshot(snapshot pb.Snapshot) error {
 	}})
 }
 
+// saveLastExport records the index and membership of the last successfully
+// exported snapshot. The record is written to a temporary file first and then
+// renamed so a partially written record is never observed.
+func (s *snapshotter) saveLastExport(ss pb.Snapshot) error {
+	record := pb.Snapshot{Index: ss.Index, Membership: ss.Membership}
+	if err := fileutil.CreateFlagFile(s.dir,
+		lastExportTmpFilename, &record, s.fs); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(s.fs.PathJoin(s.dir, lastExportTmpFilename),
+		s.fs.PathJoin(s.dir, lastExportFilename)); err != nil {
+		return err
+	}
+	return fileutil.SyncDir(s.dir, s.fs)
+}
+
+// getLastExport returns the record of the last successfully exported
+// snapshot, an empty record is returned when no snapshot has been exported.
+func (s *snapshotter) getLastExport() (pb.Snapshot, error) {
+	var ss pb.Snapshot
+	if !fileutil.HasFlagFile(s.dir, lastExportFilename, s.fs) {
+		return ss, nil
+	}
+	if err := fileutil.GetFlagFileContent(s.dir,
+		lastExportFilename, &ss, s.fs); err != nil {
+		return pb.Snapshot{}, err
+	}
+	return ss, nil
+}
+
 func (s *snapshotter) dirMatch(dir string) bool {
 	return server.SnapshotDirNameRe.Match([]byte(dir))
 }
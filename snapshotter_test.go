@@ -73,7 +73,7 @@ func getTestSnapshotter(ldb raftio.ILogDB, fs vfs.IFS) *snapshotter {
 		return fp
 	}
 	lr := logdb.NewLogReader(1, 1, ldb)
-	return newSnapshotter(1, 1, f, ldb, lr, fs)
+	return newSnapshotter(1, 1, f, ldb, lr, fs, 1)
 }
 
 func runSnapshotterTest(t *testing.T,
@@ -207,6 +207,40 @@ func TestSnapshotCanBeSavedToLogDB(t *testing.T) {
 	runSnapshotterTest(t, fn, fs)
 }
 
+func TestLastExportCanBeRecorded(t *testing.T) {
+	fs := vfs.GetTestFS()
+	fn := func(t *testing.T, ldb raftio.ILogDB, s *snapshotter) {
+		last, err := s.getLastExport()
+		if err != nil || last.Index != 0 {
+			t.Fatalf("unexpected last export %v, %v", last, err)
+		}
+		ss := pb.Snapshot{
+			Index:      100,
+			Term:       2,
+			Membership: pb.Membership{ConfigChangeId: 10},
+		}
+		for _, index := range []uint64{100, 200} {
+			ss.Index = index
+			if err := s.saveLastExport(ss); err != nil {
+				t.Fatalf("failed to record export %v", err)
+			}
+		}
+		if err := s.processOrphans(); err != nil {
+			t.Fatalf("failed to process orphans %v", err)
+		}
+		// the record is persisted
+		s = getTestSnapshotter(ldb, fs)
+		last, err = s.getLastExport()
+		if err != nil {
+			t.Fatalf("failed to get last export %v", err)
+		}
+		if last.Index != 200 || last.Membership.ConfigChangeId != 10 {
+			t.Errorf("unexpected last export %v", last)
+		}
+	}
+	runSnapshotterTest(t, fn, fs)
+}
+
 func TestZombieSnapshotDirsCanBeRemoved(t *testing.T) {
 	fs := vfs.GetTestFS()
 	fn := func(t *testing.T, ldb raftio.ILogDB, s *snapshotter) {
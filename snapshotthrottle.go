@@ -0,0 +1,174 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// snapshotWriteQuantum is the max number of bytes written by a snapshot
+	// operation in a single reservation, it allows concurrent snapshot
+	// operations to take turns.
+	snapshotWriteQuantum = 64 * 1024
+	// snapshotWriteWindow is the window used for measuring the snapshot write
+	// throughput.
+	snapshotWriteWindow = time.Second
+)
+
+// SnapshotWriteStats contains the stats of snapshot data written by snapshot
+// operations on the NodeHost, see
+// config.NodeHostConfig.MaxSnapshotWriteBytesPerSecond for details.
+type SnapshotWriteStats struct {
+	// Limit is the configured max snapshot write rate in bytes per second, 0
+	// means unlimited.
+	Limit uint64
+	// BytesPerSecond is the snapshot write throughput measured in the last
+	// complete one second window.
+	BytesPerSecond uint64
+	// TotalBytes is the total number of snapshot bytes written.
+	TotalBytes uint64
+	// Throttled is the total time snapshot operations were delayed by the
+	// rate limit.
+	Throttled time.Duration
+}
+
+// snapshotWriteLimiter limits the rate of snapshot data written by all
+// snapshot operations on a NodeHost. Each write reserves the time slot
+// required for writing it at the configured rate, reservations are granted
+// in order and each operation only holds one reservation at a time, so
+// concurrent operations share the bandwidth fairly.
+type snapshotWriteLimiter struct {
+	clock func() time.Time
+	sleep func(time.Duration)
+	// limit is protected by mu as it can be changed by setLimit
+	limit uint64
+	mu    struct {
+		sync.Mutex
+		next        time.Time
+		windowStart time.Time
+		windowBytes uint64
+		rate        uint64
+		total       uint64
+		throttled   time.Duration
+	}
+}
+
+func newSnapshotWriteLimiter(limit uint64) *snapshotWriteLimiter {
+	return &snapshotWriteLimiter{
+		clock: time.Now,
+		sleep: time.Sleep,
+		limit: limit,
+	}
+}
+
+// setLimit sets the max rate in bytes per second, 0 means unlimited. It takes
+// effect from the next write.
+func (l *snapshotWriteLimiter) setLimit(limit uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+}
+
+// wait blocks until sz bytes can be written at the configured rate.
+func (l *snapshotWriteLimiter) wait(sz uint64) {
+	l.mu.Lock()
+	now := l.clock()
+	l.record(now, sz)
+	if l.limit == 0 {
+		l.mu.Unlock()
+		return
+	}
+	if l.mu.next.Before(now) {
+		l.mu.next = now
+	}
+	delay := l.mu.next.Sub(now)
+	l.mu.next = l.mu.next.Add(time.Duration(sz * uint64(time.Second) / l.limit))
+	l.mu.throttled += delay
+	l.mu.Unlock()
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+func (l *snapshotWriteLimiter) record(now time.Time, sz uint64) {
+	if elapsed := now.Sub(l.mu.windowStart); elapsed >= snapshotWriteWindow {
+		if elapsed < 2*snapshotWriteWindow {
+			l.mu.rate = uint64(float64(l.mu.windowBytes) / elapsed.Seconds())
+		} else {
+			l.mu.rate = 0
+		}
+		l.mu.windowStart = now
+		l.mu.windowBytes = 0
+	}
+	l.mu.windowBytes += sz
+	l.mu.total += sz
+}
+
+func (l *snapshotWriteLimiter) stats() SnapshotWriteStats {
+	if l == nil {
+		return SnapshotWriteStats{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rate := l.mu.rate
+	if l.clock().Sub(l.mu.windowStart) >= 2*snapshotWriteWindow {
+		rate = 0
+	}
+	return SnapshotWriteStats{
+		Limit:          l.limit,
+		BytesPerSecond: rate,
+		TotalBytes:     l.mu.total,
+		Throttled:      l.mu.throttled,
+	}
+}
+
+// writer returns an io.WriteCloser that writes to w at the rate permitted by
+// the limiter. w is returned when the limiter is nil.
+func (l *snapshotWriteLimiter) writer(w io.WriteCloser) io.WriteCloser {
+	if l == nil {
+		return w
+	}
+	return &throttledWriter{w: w, l: l}
+}
+
+type throttledWriter struct {
+	w io.WriteCloser
+	l *snapshotWriteLimiter
+}
+
+func (t *throttledWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		sz := len(data)
+		if sz > snapshotWriteQuantum {
+			sz = snapshotWriteQuantum
+		}
+		t.l.wait(uint64(sz))
+		n, err := t.w.Write(data[:sz])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		data = data[sz:]
+	}
+	return written, nil
+}
+
+func (t *throttledWriter) Close() error {
+	return t.w.Close()
+}
@@ -0,0 +1,240 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// snapshotWriteRecorderFS is a vfs.IFS recording writes made to snapshot
+// image files, it is also a vfs injector that never injects errors so it can be
+// wrapped as a vfs.ErrorFS accepted by the LogDB.
+type snapshotWriteRecorderFS struct {
+	vfs.IFS
+	mu    sync.Mutex
+	bytes uint64
+	first time.Time
+	last  time.Time
+}
+
+func (fs *snapshotWriteRecorderFS) Create(name string) (vfs.File, error) {
+	f, err := fs.IFS.Create(name)
+	if err != nil || !strings.HasSuffix(name, server.SnapshotFileSuffix) {
+		return f, err
+	}
+	return &snapshotWriteRecorderFile{File: f, fs: fs}, nil
+}
+
+func (fs *snapshotWriteRecorderFS) MaybeError(op vfs.Op) error {
+	return nil
+}
+
+func (fs *snapshotWriteRecorderFS) record(sz int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	now := time.Now()
+	if fs.first.IsZero() {
+		fs.first = now
+	}
+	fs.last = now
+	fs.bytes += uint64(sz)
+}
+
+type snapshotWriteRecorderFile struct {
+	vfs.File
+	fs *snapshotWriteRecorderFS
+}
+
+func (f *snapshotWriteRecorderFile) Write(data []byte) (int, error) {
+	n, err := f.File.Write(data)
+	f.fs.record(n)
+	return n, err
+}
+
+// snapshotWriteTestSM is a state machine with snapshots of the specified size.
+type snapshotWriteTestSM struct {
+	size int
+}
+
+func (s *snapshotWriteTestSM) Update(e sm.Entry) (sm.Result, error) {
+	return sm.Result{Value: uint64(len(e.Cmd))}, nil
+}
+
+func (s *snapshotWriteTestSM) Lookup(query interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func (s *snapshotWriteTestSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	data := make([]byte, 1024)
+	for i := 0; i < s.size/len(data); i++ {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *snapshotWriteTestSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+func (s *snapshotWriteTestSM) Close() error { return nil }
+
+func TestSnapshotWriteLimiterLimitsWriteRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	var mu sync.Mutex
+	l := newSnapshotWriteLimiter(1024 * 1024)
+	l.clock = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	// the fake clock moves forward when a write is delayed
+	l.sleep = func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+	w1 := l.writer(&memObject{})
+	w2 := l.writer(&memObject{})
+	data := make([]byte, snapshotWriteQuantum)
+	for i := 0; i < 16; i++ {
+		for _, w := range []io.Writer{w1, w2} {
+			if _, err := w.Write(data); err != nil {
+				t.Fatalf("write failed %v", err)
+			}
+		}
+	}
+	// 2MB written at 1MB/s, the first write is not delayed
+	want := 2*time.Second - time.Second/16
+	s := l.stats()
+	if s.Throttled < want-time.Millisecond {
+		t.Errorf("throttled %s, want %s", s.Throttled, want)
+	}
+	if s.TotalBytes != 2*1024*1024 || s.Limit != 1024*1024 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	if s.BytesPerSecond < 900*1024 || s.BytesPerSecond > 1100*1024 {
+		t.Errorf("unexpected rate %d", s.BytesPerSecond)
+	}
+}
+
+func TestConcurrentSnapshotWritersTakeTurns(t *testing.T) {
+	l := newSnapshotWriteLimiter(8 * 1024 * 1024)
+	start := time.Now()
+	finished := make([]time.Duration, 2)
+	var wg sync.WaitGroup
+	for i := range finished {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := l.writer(&memObject{})
+			data := make([]byte, snapshotWriteQuantum)
+			for j := 0; j < 16; j++ {
+				if _, err := w.Write(data); err != nil {
+					t.Errorf("write failed %v", err)
+				}
+			}
+			finished[i] = time.Since(start)
+		}(i)
+	}
+	wg.Wait()
+	// 2MB written at 8MB/s, neither writer is starved by the other
+	if finished[0] < 200*time.Millisecond && finished[1] < 200*time.Millisecond {
+		t.Errorf("writes not limited, %v", finished)
+	}
+	first, second := finished[0], finished[1]
+	if first > second {
+		first, second = second, first
+	}
+	if first < second*3/4 {
+		t.Errorf("writers not sharing bandwidth, %v", finished)
+	}
+}
+
+func TestSnapshotWriteLimiterWithoutLimitOnlyRecordsStats(t *testing.T) {
+	l := newSnapshotWriteLimiter(0)
+	l.sleep = func(time.Duration) {
+		t.Fatalf("unexpected delay")
+	}
+	w := l.writer(&memObject{})
+	if _, err := w.Write(make([]byte, 3*snapshotWriteQuantum)); err != nil {
+		t.Fatalf("write failed %v", err)
+	}
+	if s := l.stats(); s.TotalBytes != 3*snapshotWriteQuantum || s.Throttled != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	var nilLimiter *snapshotWriteLimiter
+	o := &memObject{}
+	if nilLimiter.writer(o) != o {
+		t.Errorf("writer unexpectedly wrapped")
+	}
+	if s := nilLimiter.stats(); s != (SnapshotWriteStats{}) {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestSnapshotWriteRateIsLimited(t *testing.T) {
+	rfs := &snapshotWriteRecorderFS{IFS: vfs.GetTestFS()}
+	fs := vfs.Wrap(rfs, rfs)
+	limit := uint64(4 * 1024 * 1024)
+	size := 1024 * 1024
+	to := &testOption{
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &snapshotWriteTestSM{size: size}
+		},
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.MaxSnapshotWriteBytesPerSecond = limit
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			makeProposals(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), lpto(nh))
+			defer cancel()
+			if _, err := nh.SyncRequestSnapshot(ctx, 1, SnapshotOption{}); err != nil {
+				t.Fatalf("failed to request snapshot %v", err)
+			}
+			rfs.mu.Lock()
+			written, elapsed := rfs.bytes, rfs.last.Sub(rfs.first)
+			rfs.mu.Unlock()
+			if written < uint64(size) {
+				t.Fatalf("only %d bytes written", written)
+			}
+			// the first quantum is written without being delayed
+			rate := float64(written-snapshotWriteQuantum) / elapsed.Seconds()
+			if rate > float64(limit)*1.1 {
+				t.Errorf("write rate %f, limit %d", rate, limit)
+			}
+			s := nh.GetEngineStats().SnapshotWrite
+			if s.Limit != limit || s.TotalBytes < uint64(size) || s.Throttled == 0 {
+				t.Errorf("unexpected stats %+v", s)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
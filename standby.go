@@ -0,0 +1,171 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// standbyState is the state kept by a warm standby replica for activating it.
+type standbyState struct {
+	createSM rsm.ManagedStateMachineFactory
+	smType   pb.StateMachineType
+}
+
+// standbyStateMachine is the placeholder state machine of warm standby
+// replicas. Committed entries are dropped by it, snapshots received from the
+// leader are only read through to have their checksums verified, they are kept
+// by the snapshotter for recovering the actual state machine on activation.
+type standbyStateMachine struct{}
+
+var _ sm.IStateMachine = (*standbyStateMachine)(nil)
+
+func getStandbyStateMachineFactory(
+	cfg config.Config) rsm.ManagedStateMachineFactory {
+	return func(shardID uint64, replicaID uint64,
+		done <-chan struct{}) rsm.IManagedStateMachine {
+		return rsm.NewNativeSM(cfg,
+			rsm.NewInMemStateMachine(&standbyStateMachine{}), done)
+	}
+}
+
+func (s *standbyStateMachine) Update(e sm.Entry) (sm.Result, error) {
+	return sm.Result{}, nil
+}
+
+func (s *standbyStateMachine) Lookup(query interface{}) (interface{}, error) {
+	return nil, ErrInvalidOperation
+}
+
+func (s *standbyStateMachine) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	panic("standby replica can not save snapshot")
+}
+
+func (s *standbyStateMachine) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+func (s *standbyStateMachine) Close() error {
+	return nil
+}
+
+// isStandby returns a boolean value indicating whether the replica is a warm
+// standby not yet activated.
+func (n *node) isStandby() bool {
+	return n.standby != nil
+}
+
+// stateMachineType returns the type of the state machine of the replica, it
+// is the type of the state machine to be created on activation when the
+// replica is a warm standby.
+func (n *node) stateMachineType() sm.Type {
+	if n.isStandby() {
+		return sm.Type(n.standby.smType)
+	}
+	return sm.Type(n.sm.Type())
+}
+
+// markActivated records in the bootstrap info that the warm standby has been
+// activated, it is no longer started as a standby from now on.
+func (n *node) markActivated() error {
+	bi, err := n.logdb.GetBootstrapInfo(n.shardID, n.replicaID)
+	if err != nil {
+		return err
+	}
+	bi.Standby = false
+	return n.logdb.SaveBootstrapInfo(n.shardID, n.replicaID, bi)
+}
+
+// activated returns a boolean value indicating whether the activated replica
+// has recovered from its latest snapshot and applied all entries committed
+// before it was restarted.
+func (n *node) activated() bool {
+	return n.initialized() && n.sm.GetLastApplied() >= n.replayedIndex
+}
+
+// ActivateStandby activates the warm standby replica of the specified shard,
+// see config.Config.Standby for details on warm standby replicas. The replica
+// is restarted with its state machine created by the factory function
+// specified when the standby replica was started, the state machine is
+// recovered from the latest snapshot received from the leader and all
+// committed entries persisted in the local Raft log are applied before
+// ActivateStandby returns.
+//
+// The activation is recorded in the bootstrap info, the replica is no longer
+// started as a standby once ActivateStandby is invoked. The activated replica
+// remains a non-voting member of the shard, use SyncRequestAddReplica to
+// promote it to a voting member. ErrInvalidOperation is returned when the
+// local replica of the shard is not a warm standby.
+func (nh *NodeHost) ActivateStandby(ctx context.Context,
+	shardID uint64) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "ActivateStandby",
+		ShardID:   shardID,
+	}, time.Now(), &err)
+	return nh.activateStandby(ctx, shardID)
+}
+
+func (nh *NodeHost) activateStandby(ctx context.Context, shardID uint64) error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return ErrShardNotFound
+	}
+	if !n.isStandby() {
+		return ErrInvalidOperation
+	}
+	if err := n.markActivated(); err != nil {
+		return err
+	}
+	replicaID := n.replicaID
+	if err := nh.stopNode(shardID, replicaID, true); err != nil {
+		return err
+	}
+	plog.Infof("%s activating standby replica", n.id())
+	for nh.engine.nodeLoaded(shardID, replicaID) {
+		if err := nh.waitRTT(ctx); err != nil {
+			return err
+		}
+	}
+	if err := nh.startShard(nil, false,
+		n.standby.createSM, n.config, n.standby.smType); err != nil {
+		return err
+	}
+	for {
+		rn, ok := nh.getShard(shardID)
+		if !ok || rn.replicaID != replicaID {
+			return ErrShardNotFound
+		}
+		if rn.activated() {
+			return nil
+		}
+		if err := nh.waitRTT(ctx); err != nil {
+			return err
+		}
+	}
+}
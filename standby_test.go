@@ -0,0 +1,268 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// standbyTestSM counts the applied entries.
+type standbyTestSM struct {
+	count uint64
+}
+
+func (s *standbyTestSM) Update(e sm.Entry) (sm.Result, error) {
+	s.count++
+	return sm.Result{Value: s.count}, nil
+}
+
+func (s *standbyTestSM) Lookup(query interface{}) (interface{}, error) {
+	return s.count, nil
+}
+
+func (s *standbyTestSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	v := make([]byte, 8)
+	binary.LittleEndian.PutUint64(v, s.count)
+	_, err := w.Write(v)
+	return err
+}
+
+func (s *standbyTestSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	v := make([]byte, 8)
+	if _, err := io.ReadFull(r, v); err != nil {
+		return err
+	}
+	s.count = binary.LittleEndian.Uint64(v)
+	return nil
+}
+
+func (s *standbyTestSM) Close() error { return nil }
+
+func startStandbyTestLeader(t testing.TB, nh *NodeHost) {
+	rc := config.Config{
+		ShardID:      1,
+		ReplicaID:    1,
+		ElectionRTT:  10,
+		HeartbeatRTT: 1,
+		CheckQuorum:  true,
+	}
+	peers := map[uint64]string{1: memtransport.Address(1)}
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &standbyTestSM{}
+	}
+	if err := nh.StartReplica(peers, false, createSM, rc); err != nil {
+		t.Fatalf("failed to start replica %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, _, ok, err := nh.GetLeaderID(1); err == nil && ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("failed to elect leader")
+}
+
+func proposeStandbyTestEntries(t testing.TB, nh *NodeHost, count int) {
+	cs := nh.GetNoOPSession(1)
+	for i := 0; i < count; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+		_, err := nh.SyncPropose(ctx, cs, make([]byte, 16))
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to make proposal %v", err)
+		}
+	}
+}
+
+// addNonVotingTestReplica adds a non-voting replica to shard 1 and starts it
+// on the specified NodeHost. The counter of state machine factory invocations
+// is returned.
+func addNonVotingTestReplica(t testing.TB, leader *NodeHost,
+	nh *NodeHost, replicaID uint64, standby bool) *uint64 {
+	ctx, cancel := context.WithTimeout(context.Background(), pto(leader))
+	defer cancel()
+	addr := memtransport.Address(int(replicaID))
+	if err := leader.SyncRequestAddNonVoting(ctx,
+		1, replicaID, addr, 0); err != nil {
+		t.Fatalf("failed to add non-voting replica %v", err)
+	}
+	rc := config.Config{
+		ShardID:      1,
+		ReplicaID:    replicaID,
+		ElectionRTT:  10,
+		HeartbeatRTT: 1,
+		IsNonVoting:  true,
+		Standby:      standby,
+	}
+	created := new(uint64)
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		atomic.AddUint64(created, 1)
+		return &standbyTestSM{}
+	}
+	if err := nh.StartReplica(nil, true, createSM, rc); err != nil {
+		t.Fatalf("failed to start replica %v", err)
+	}
+	return created
+}
+
+func getTestLastApplied(nh *NodeHost) uint64 {
+	n, ok := nh.getShard(1)
+	if !ok || !n.initialized() {
+		return 0
+	}
+	return n.sm.GetLastApplied()
+}
+
+func waitForTestLastApplied(t testing.TB, nh *NodeHost, index uint64) {
+	for i := 0; i < 1000; i++ {
+		if getTestLastApplied(nh) >= index {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("index %d not applied", index)
+}
+
+func TestStandbyReplicaReplicatesWithoutApplying(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		startStandbyTestLeader(t, nhs[0])
+		proposeStandbyTestEntries(t, nhs[0], 10)
+		// the standby receives the first entries in a snapshot
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[0]))
+		defer cancel()
+		opt := SnapshotOption{OverrideCompactionOverhead: true}
+		if _, err := nhs[0].SyncRequestSnapshot(ctx, 1, opt); err != nil {
+			t.Fatalf("failed to request snapshot %v", err)
+		}
+		created := addNonVotingTestReplica(t, nhs[0], nhs[1], 2, true)
+		proposeStandbyTestEntries(t, nhs[0], 10)
+		waitForTestLastApplied(t, nhs[1], getTestLastApplied(nhs[0]))
+		if v := atomic.LoadUint64(created); v != 0 {
+			t.Errorf("state machine created %d times", v)
+		}
+		ss, err := nhs[1].mu.logdb.GetSnapshot(1, 2)
+		if err != nil {
+			t.Fatalf("failed to get snapshot %v", err)
+		}
+		if ss.Index == 0 {
+			t.Errorf("snapshot not received")
+		}
+		cs := nhs[1].GetNoOPSession(1)
+		if _, err := nhs[1].SyncPropose(ctx, cs, []byte("test")); err != ErrInvalidOperation {
+			t.Errorf("proposal not rejected, %v", err)
+		}
+		if _, err := nhs[1].StaleRead(1, nil); err != ErrInvalidOperation {
+			t.Errorf("stale read not rejected, %v", err)
+		}
+		if _, err := nhs[1].SyncRequestSnapshot(ctx, 1, SnapshotOption{}); err != ErrInvalidOperation {
+			t.Errorf("snapshot request not rejected, %v", err)
+		}
+		info := nhs[1].GetNodeHostInfo(DefaultNodeHostInfoOption)
+		if len(info.ShardInfoList) != 1 || !info.ShardInfoList[0].IsStandby ||
+			info.ShardInfoList[0].StateMachineType != sm.RegularStateMachine {
+			t.Errorf("unexpected shard info %+v", info.ShardInfoList)
+		}
+		if err := nhs[1].ActivateStandby(ctx, 1); err != nil {
+			t.Fatalf("failed to activate standby %v", err)
+		}
+		if v := atomic.LoadUint64(created); v != 1 {
+			t.Errorf("state machine created %d times", v)
+		}
+		v, err := nhs[1].StaleRead(1, nil)
+		if err != nil {
+			t.Fatalf("stale read failed %v", err)
+		}
+		if v.(uint64) != 20 {
+			t.Errorf("count %d, want 20", v)
+		}
+		info = nhs[1].GetNodeHostInfo(DefaultNodeHostInfoOption)
+		if info.ShardInfoList[0].IsStandby {
+			t.Errorf("replica still reported as standby")
+		}
+		bi, err := nhs[1].mu.logdb.GetBootstrapInfo(1, 2)
+		if err != nil {
+			t.Fatalf("failed to get bootstrap info %v", err)
+		}
+		if bi.Standby {
+			t.Errorf("activation not recorded")
+		}
+		if err := nhs[1].ActivateStandby(ctx, 1); err != ErrInvalidOperation {
+			t.Errorf("activated twice, %v", err)
+		}
+		// the activated replica keeps applying entries
+		proposeStandbyTestEntries(t, nhs[0], 5)
+		waitForTestLastApplied(t, nhs[1], getTestLastApplied(nhs[0]))
+		v, err = nhs[1].StaleRead(1, nil)
+		if err != nil {
+			t.Fatalf("stale read failed %v", err)
+		}
+		if v.(uint64) != 25 {
+			t.Errorf("count %d, want 25", v)
+		}
+	}
+	memTransportNodeHostTest(t, 2, tf, fs)
+}
+
+func TestStandbyReplicaMustJoin(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    1,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+			IsNonVoting:  true,
+			Standby:      true,
+		}
+		peers := map[uint64]string{1: memtransport.Address(1)}
+		createSM := func(uint64, uint64) sm.IStateMachine {
+			return &standbyTestSM{}
+		}
+		if err := nhs[0].StartReplica(peers,
+			false, createSM, rc); err != ErrInvalidShardSettings {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	memTransportNodeHostTest(t, 1, tf, fs)
+}
+
+func TestActivateStandbyRejectsNonStandbyReplica(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		startStandbyTestLeader(t, nhs[0])
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[0]))
+		defer cancel()
+		if err := nhs[0].ActivateStandby(ctx, 1); err != ErrInvalidOperation {
+			t.Errorf("unexpected error %v", err)
+		}
+		if err := nhs[0].ActivateStandby(ctx, 2); err != ErrShardNotFound {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	memTransportNodeHostTest(t, 1, tf, fs)
+}
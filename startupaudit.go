@@ -0,0 +1,358 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/logdb"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+var (
+	// ErrStartupAuditFailed indicates that inconsistencies have been found in
+	// the persisted state of the replica being started.
+	ErrStartupAuditFailed = errors.New("startup audit failed")
+)
+
+// StartupAuditCheck is the type of a check performed by the startup audit,
+// see config.NodeHostConfig.AuditOnStart for details.
+type StartupAuditCheck int
+
+const (
+	// AuditCommitIndex checks that the commit index recorded in the LogDB is
+	// not beyond the last Raft log entry.
+	AuditCommitIndex StartupAuditCheck = iota
+	// AuditSnapshotIndex checks that the latest snapshot is neither beyond the
+	// last Raft log entry nor beyond the commit index.
+	AuditSnapshotIndex
+	// AuditSnapshotFile checks that the file of the latest snapshot exists.
+	AuditSnapshotFile
+	// AuditMembership checks that the membership recorded in the latest
+	// snapshot is consistent with the snapshot and the replica.
+	AuditMembership
+	// AuditOnDiskIndex checks that the applied index reported by the on disk
+	// state machine is within the range of the snapshot and the Raft log.
+	AuditOnDiskIndex
+)
+
+var startupAuditCheckNames = [...]string{
+	AuditCommitIndex:   "CommitIndex",
+	AuditSnapshotIndex: "SnapshotIndex",
+	AuditSnapshotFile:  "SnapshotFile",
+	AuditMembership:    "Membership",
+	AuditOnDiskIndex:   "OnDiskIndex",
+}
+
+func (c StartupAuditCheck) String() string {
+	if c < AuditCommitIndex || c > AuditOnDiskIndex {
+		return fmt.Sprintf("StartupAuditCheck(%d)", int(c))
+	}
+	return startupAuditCheckNames[c]
+}
+
+// StartupAuditViolation is an inconsistency found by the startup audit.
+type StartupAuditViolation struct {
+	// Check is the type of the check that found the inconsistency.
+	Check StartupAuditCheck
+	// Detail describes the inconsistency.
+	Detail string
+	// Repaired indicates whether the inconsistency has been repaired.
+	Repaired bool
+}
+
+func (v StartupAuditViolation) String() string {
+	status := "FAIL"
+	if v.Repaired {
+		status = "REPAIRED"
+	}
+	return fmt.Sprintf("%s %s: %s", status, v.Check, v.Detail)
+}
+
+// StartupAuditReport is the report of the startup audit of a replica.
+type StartupAuditReport struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// SnapshotIndex is the index of the latest snapshot recorded in the LogDB.
+	SnapshotIndex uint64
+	// FirstIndex and LastIndex are the range of Raft log entries after the
+	// latest snapshot, LastIndex is the snapshot index when there is no such
+	// entry.
+	FirstIndex uint64
+	LastIndex  uint64
+	// Commit is the commit index recorded in the LogDB, it is the repaired
+	// commit index when it has been repaired.
+	Commit uint64
+	// OnDiskIndex is the applied index reported by the on disk state machine,
+	// it is 0 for other state machine types.
+	OnDiskIndex uint64
+	// Violations are the inconsistencies found.
+	Violations []StartupAuditViolation
+}
+
+// Failed returns the violations not repaired.
+func (r *StartupAuditReport) Failed() []StartupAuditViolation {
+	var failed []StartupAuditViolation
+	for _, v := range r.Violations {
+		if !v.Repaired {
+			failed = append(failed, v)
+		}
+	}
+	return failed
+}
+
+func (r *StartupAuditReport) repaired() uint64 {
+	return uint64(len(r.Violations) - len(r.Failed()))
+}
+
+func (r *StartupAuditReport) String() string {
+	lines := make([]string, 0, len(r.Violations)+1)
+	lines = append(lines, fmt.Sprintf("%s snapshot %d, log [%d, %d], "+
+		"commit %d, on disk index %d", dn(r.ShardID, r.ReplicaID),
+		r.SnapshotIndex, r.FirstIndex, r.LastIndex, r.Commit, r.OnDiskIndex))
+	for _, v := range r.Violations {
+		lines = append(lines, v.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// StartupAuditError is the error returned by StartReplica and its variants
+// when inconsistencies not repaired have been found by the startup audit,
+// Report contains all found inconsistencies.
+type StartupAuditError struct {
+	Report *StartupAuditReport
+}
+
+func (e *StartupAuditError) Error() string {
+	failed := e.Report.Failed()
+	return fmt.Sprintf("%s %d inconsistency(s) found, %s",
+		dn(e.Report.ShardID, e.Report.ReplicaID), len(failed), failed[0])
+}
+
+// Unwrap returns ErrStartupAuditFailed.
+func (e *StartupAuditError) Unwrap() error {
+	return ErrStartupAuditFailed
+}
+
+// auditReplica cross-checks the persisted state of the specified replica
+// before it is started. Commit indexes are adjusted when it is provably safe
+// and NodeHostConfig.AuditRepair is enabled, a StartupAuditFailed system event
+// is published whenever an inconsistency is found.
+func (nh *NodeHost) auditReplica(cfg config.Config, standby bool,
+	createStateMachine rsm.ManagedStateMachineFactory,
+	smType pb.StateMachineType) error {
+	report, rs, err := nh.getStartupAuditReport(cfg, standby,
+		createStateMachine, smType)
+	if err != nil || report == nil || len(report.Violations) == 0 {
+		return err
+	}
+	if rs.Commit != report.Commit {
+		if err := nh.repairCommit(cfg, rs, report); err != nil {
+			return err
+		}
+	}
+	plog.Warningf("startup audit found inconsistencies\n%s", report)
+	nh.events.sys.Publish(server.SystemEvent{
+		Type:      server.StartupAuditFailed,
+		ShardID:   cfg.ShardID,
+		ReplicaID: cfg.ReplicaID,
+		Total:     uint64(len(report.Violations)),
+		Completed: report.repaired(),
+		Reason:    report.String(),
+	})
+	if len(report.Failed()) > 0 {
+		return &StartupAuditError{Report: report}
+	}
+	return nil
+}
+
+// getStartupAuditReport returns the report and the recorded Raft state, the
+// Commit field of the report is the repaired commit index. nil report is
+// returned when there is nothing to audit.
+func (nh *NodeHost) getStartupAuditReport(cfg config.Config, standby bool,
+	createStateMachine rsm.ManagedStateMachineFactory,
+	smType pb.StateMachineType) (*StartupAuditReport, pb.State, error) {
+	shardID, replicaID := cfg.ShardID, cfg.ReplicaID
+	repair := nh.nhConfig.AuditRepair
+	ss, err := nh.mu.logdb.GetSnapshot(shardID, replicaID)
+	if err != nil {
+		return nil, pb.State{}, err
+	}
+	report := &StartupAuditReport{
+		ShardID:       shardID,
+		ReplicaID:     replicaID,
+		SnapshotIndex: ss.Index,
+	}
+	violation := func(check StartupAuditCheck, repaired bool,
+		format string, args ...interface{}) {
+		report.Violations = append(report.Violations, StartupAuditViolation{
+			Check:    check,
+			Detail:   fmt.Sprintf(format, args...),
+			Repaired: repaired,
+		})
+	}
+	// reading the Raft state of a replica with its snapshot beyond the last
+	// entry causes a panic, such max index is only available from the
+	// built-in LogDB
+	if ldb, ok := nh.mu.logdb.(*logdb.ShardedDB); ok {
+		maxIndex, err := ldb.GetMaxIndex(shardID, replicaID)
+		if errors.Is(err, raftio.ErrNoSavedLog) {
+			return nil, pb.State{}, nil
+		}
+		if err != nil {
+			return nil, pb.State{}, err
+		}
+		if ss.Index > maxIndex {
+			report.LastIndex = maxIndex
+			violation(AuditSnapshotIndex, false,
+				"snapshot index %d beyond last index %d", ss.Index, maxIndex)
+			return report, pb.State{}, nil
+		}
+	}
+	rs, err := nh.mu.logdb.ReadRaftState(shardID, replicaID, ss.Index)
+	if errors.Is(err, raftio.ErrNoSavedLog) {
+		return nil, pb.State{}, nil
+	}
+	if err != nil {
+		return nil, pb.State{}, err
+	}
+	report.FirstIndex = rs.FirstIndex
+	report.LastIndex = ss.Index
+	if rs.EntryCount > 0 {
+		report.LastIndex = rs.FirstIndex + rs.EntryCount - 1
+	}
+	report.Commit = rs.State.Commit
+	// the commit index is never beyond the last entry as entries are saved
+	// before or together with the commit index, they are always committed
+	// once applied or included in a snapshot
+	if report.Commit > report.LastIndex {
+		violation(AuditCommitIndex, repair,
+			"commit index %d beyond last index %d", report.Commit, report.LastIndex)
+		if repair {
+			report.Commit = report.LastIndex
+		}
+	}
+	if ss.Index > report.Commit {
+		violation(AuditSnapshotIndex, repair,
+			"snapshot index %d beyond commit index %d", ss.Index, report.Commit)
+		if repair {
+			report.Commit = ss.Index
+		}
+	}
+	if !pb.IsEmptySnapshot(ss) {
+		nh.auditSnapshot(ss, replicaID, violation)
+	}
+	if smType == pb.OnDiskStateMachine && !standby {
+		index, err := getOnDiskIndex(cfg, createStateMachine)
+		if err != nil {
+			return nil, pb.State{}, err
+		}
+		report.OnDiskIndex = index
+		if index > report.LastIndex {
+			violation(AuditOnDiskIndex, false,
+				"on disk index %d beyond last index %d", index, report.LastIndex)
+		} else if index > report.Commit {
+			violation(AuditOnDiskIndex, repair,
+				"on disk index %d beyond commit index %d", index, report.Commit)
+			if repair {
+				report.Commit = index
+			}
+		}
+		if index < ss.OnDiskIndex && !ss.Dummy && !ss.Witness {
+			// a shrunk snapshot can no longer be used to recover the state machine
+			shrunk, err := rsm.IsShrunkSnapshotFile(ss.Filepath, nh.fs)
+			if err == nil && shrunk {
+				violation(AuditOnDiskIndex, false,
+					"on disk index %d behind shrunk snapshot %d",
+					index, ss.OnDiskIndex)
+			}
+		}
+	}
+	return report, rs.State, nil
+}
+
+func (nh *NodeHost) auditSnapshot(ss pb.Snapshot, replicaID uint64,
+	violation func(StartupAuditCheck, bool, string, ...interface{})) {
+	if !ss.Dummy && !ss.Witness {
+		exist, err := fileutil.Exist(ss.Filepath, nh.fs)
+		if err != nil || !exist {
+			violation(AuditSnapshotFile, false,
+				"snapshot file %s not found, %v", ss.Filepath, err)
+		}
+	}
+	m := ss.Membership
+	if m.ConfigChangeId > ss.Index {
+		violation(AuditMembership, false,
+			"config change id %d beyond snapshot index %d",
+			m.ConfigChangeId, ss.Index)
+	}
+	_, voting := m.Addresses[replicaID]
+	_, nonVoting := m.NonVotings[replicaID]
+	_, witness := m.Witnesses[replicaID]
+	removed := m.IsRemoved(replicaID)
+	if !voting && !nonVoting && !witness && !removed {
+		violation(AuditMembership, false,
+			"replica not in the membership of snapshot %d", ss.Index)
+	}
+}
+
+// repairCommit saves the commit index of the report. It is only supported by
+// the built-in LogDB as other LogDB implementations can only be written by
+// step workers.
+func (nh *NodeHost) repairCommit(cfg config.Config,
+	state pb.State, report *StartupAuditReport) error {
+	ldb, ok := nh.mu.logdb.(*logdb.ShardedDB)
+	if !ok {
+		for i := range report.Violations {
+			report.Violations[i].Repaired = false
+		}
+		report.Commit = state.Commit
+		return nil
+	}
+	ctx := ldb.GetLogDBThreadContext()
+	defer ctx.Destroy()
+	state.Commit = report.Commit
+	if err := ldb.SaveRaftStateCtx([]pb.Update{{
+		ShardID:   cfg.ShardID,
+		ReplicaID: cfg.ReplicaID,
+		State:     state,
+	}}, ctx); err != nil {
+		return err
+	}
+	plog.Infof("%s commit index repaired, %d", dn(cfg.ShardID, cfg.ReplicaID),
+		state.Commit)
+	return nil
+}
+
+// getOnDiskIndex opens and closes a temporary instance of the on disk state
+// machine to get its applied index.
+func getOnDiskIndex(cfg config.Config,
+	createStateMachine rsm.ManagedStateMachineFactory) (index uint64, err error) {
+	done := make(chan struct{})
+	defer close(done)
+	sm := createStateMachine(cfg.ShardID, cfg.ReplicaID, done)
+	defer func() {
+		err = firstError(err, sm.Close())
+	}()
+	return sm.Open()
+}
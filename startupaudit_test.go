@@ -0,0 +1,311 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/logdb"
+	"github.com/lni/dragonboat/v4/internal/tests"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+var auditTestReplicaConfig = config.Config{
+	ShardID:      1,
+	ReplicaID:    1,
+	ElectionRTT:  10,
+	HeartbeatRTT: 1,
+	CheckQuorum:  true,
+}
+
+// restartAuditTestNodeHost replaces nhs[0] with a new NodeHost instance with
+// the startup audit enabled, the replica is not started.
+func restartAuditTestNodeHost(t *testing.T,
+	nhs []*NodeHost, repair bool) *testSysEventListener {
+	nhc := nhs[0].NodeHostConfig()
+	nhs[0].Close()
+	listener := &testSysEventListener{}
+	nhc.AuditOnStart = true
+	nhc.AuditRepair = repair
+	nhc.SystemEventListener = listener
+	nh, err := NewNodeHost(nhc)
+	if err != nil {
+		t.Fatalf("failed to create nodehost %v", err)
+	}
+	nhs[0] = nh
+	return listener
+}
+
+func getAuditTestLastIndex(t *testing.T, nh *NodeHost) (pb.Snapshot, uint64) {
+	ss, err := nh.mu.logdb.GetSnapshot(1, 1)
+	if err != nil {
+		t.Fatalf("failed to get snapshot %v", err)
+	}
+	rs, err := nh.mu.logdb.ReadRaftState(1, 1, ss.Index)
+	if err != nil {
+		t.Fatalf("failed to read raft state %v", err)
+	}
+	if rs.EntryCount == 0 {
+		return ss, ss.Index
+	}
+	return ss, rs.FirstIndex + rs.EntryCount - 1
+}
+
+func setAuditTestCommit(t *testing.T, nh *NodeHost, commit uint64) {
+	ldb := nh.mu.logdb.(*logdb.ShardedDB)
+	ss, err := ldb.GetSnapshot(1, 1)
+	if err != nil {
+		t.Fatalf("failed to get snapshot %v", err)
+	}
+	rs, err := ldb.ReadRaftState(1, 1, ss.Index)
+	if err != nil {
+		t.Fatalf("failed to read raft state %v", err)
+	}
+	rs.State.Commit = commit
+	ctx := ldb.GetLogDBThreadContext()
+	defer ctx.Destroy()
+	if err := ldb.SaveRaftStateCtx([]pb.Update{{
+		ShardID:   1,
+		ReplicaID: 1,
+		State:     rs.State,
+	}}, ctx); err != nil {
+		t.Fatalf("failed to save raft state %v", err)
+	}
+}
+
+func saveAuditTestSnapshot(t *testing.T, nh *NodeHost, ss pb.Snapshot) {
+	if err := nh.mu.logdb.SaveSnapshots([]pb.Update{{
+		ShardID:   1,
+		ReplicaID: 1,
+		Snapshot:  ss,
+	}}); err != nil {
+		t.Fatalf("failed to save snapshot %v", err)
+	}
+}
+
+func waitForStartupAuditEvent(t *testing.T,
+	listener *testSysEventListener, violations uint64, repaired uint64) {
+	for i := 0; i < 500 && len(listener.getStartupAuditEvents()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	events := listener.getStartupAuditEvents()
+	if len(events) != 1 {
+		t.Fatalf("unexpected events %v", events)
+	}
+	e := events[0]
+	if e.ShardID != 1 || e.ReplicaID != 1 ||
+		e.Violations != violations || e.Repaired != repaired {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func checkStartupAuditError(t *testing.T,
+	err error, checks ...StartupAuditCheck) {
+	if !errors.Is(err, ErrStartupAuditFailed) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var ae *StartupAuditError
+	if !errors.As(err, &ae) {
+		t.Fatalf("not a StartupAuditError, %v", err)
+	}
+	failed := ae.Report.Failed()
+	if len(failed) != len(checks) {
+		t.Fatalf("unexpected report\n%s", ae.Report)
+	}
+	for i, check := range checks {
+		if failed[i].Check != check {
+			t.Errorf("violation %d, check %s, want %s", i, failed[i].Check, check)
+		}
+	}
+}
+
+func TestStartupAuditReportsInconsistentSnapshots(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, nh *NodeHost, ss pb.Snapshot, lastIndex uint64)
+		checks []StartupAuditCheck
+	}{
+		{
+			"snapshot file missing",
+			func(t *testing.T, nh *NodeHost, ss pb.Snapshot, lastIndex uint64) {
+				if err := nh.fs.Remove(ss.Filepath); err != nil {
+					t.Fatalf("failed to remove snapshot file %v", err)
+				}
+			},
+			[]StartupAuditCheck{AuditSnapshotFile},
+		},
+		{
+			"snapshot beyond last index",
+			func(t *testing.T, nh *NodeHost, ss pb.Snapshot, lastIndex uint64) {
+				ss.Index = lastIndex + 10
+				saveAuditTestSnapshot(t, nh, ss)
+			},
+			[]StartupAuditCheck{AuditSnapshotIndex},
+		},
+		{
+			"replica not in membership",
+			func(t *testing.T, nh *NodeHost, ss pb.Snapshot, lastIndex uint64) {
+				ss.Membership = pb.Membership{
+					ConfigChangeId: ss.Index + 1,
+					Addresses:      map[uint64]string{2: memtransport.Address(2)},
+				}
+				saveAuditTestSnapshot(t, nh, ss)
+			},
+			[]StartupAuditCheck{AuditMembership, AuditMembership},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := vfs.GetTestFS()
+			tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+				members := map[uint64]string{1: memtransport.Address(1)}
+				startCloneTestShard(t, nhs, 1, []uint64{1}, members)
+				ctx, cancel := context.WithTimeout(context.Background(), lpto(nhs[0]))
+				defer cancel()
+				if _, err := nhs[0].SyncPropose(ctx,
+					nhs[0].GetNoOPSession(1), []byte("a=1")); err != nil {
+					t.Fatalf("failed to propose %v", err)
+				}
+				if _, err := nhs[0].SyncRequestSnapshot(ctx,
+					1, SnapshotOption{}); err != nil {
+					t.Fatalf("failed to request snapshot %v", err)
+				}
+				// snapshot records of the new NodeHost are tampered before they are
+				// cached, repair is enabled, such inconsistencies are not repairable
+				ss, lastIndex := getAuditTestLastIndex(t, nhs[0])
+				listener := restartAuditTestNodeHost(t, nhs, true)
+				tt.tamper(t, nhs[0], ss, lastIndex)
+				err := nhs[0].StartReplica(nil,
+					false, newCloneTestSM, auditTestReplicaConfig)
+				checkStartupAuditError(t, err, tt.checks...)
+				waitForStartupAuditEvent(t, listener, uint64(len(tt.checks)), 0)
+				if _, ok := nhs[0].getShard(1); ok {
+					t.Errorf("replica started")
+				}
+			}
+			memTransportNodeHostTest(t, 1, tf, fs)
+		})
+	}
+}
+
+func TestStartupAuditCanRepairCommitIndex(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := map[uint64]string{1: memtransport.Address(1)}
+		startCloneTestShard(t, nhs, 1, []uint64{1}, members)
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(nhs[0]))
+		defer cancel()
+		for i := 0; i < 5; i++ {
+			cmd := fmt.Sprintf("k%d=%d", i, i)
+			if _, err := nhs[0].SyncPropose(ctx,
+				nhs[0].GetNoOPSession(1), []byte(cmd)); err != nil {
+				t.Fatalf("failed to propose %v", err)
+			}
+		}
+		listener := restartAuditTestNodeHost(t, nhs, false)
+		_, lastIndex := getAuditTestLastIndex(t, nhs[0])
+		setAuditTestCommit(t, nhs[0], lastIndex+100)
+		err := nhs[0].StartReplica(nil,
+			false, newCloneTestSM, auditTestReplicaConfig)
+		checkStartupAuditError(t, err, AuditCommitIndex)
+		waitForStartupAuditEvent(t, listener, 1, 0)
+		if e := listener.getStartupAuditEvents()[0]; !strings.Contains(e.Report,
+			fmt.Sprintf("commit index %d beyond last index %d",
+				lastIndex+100, lastIndex)) {
+			t.Errorf("unexpected report %s", e.Report)
+		}
+		listener = restartAuditTestNodeHost(t, nhs, true)
+		if err := nhs[0].StartReplica(nil,
+			false, newCloneTestSM, auditTestReplicaConfig); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+		waitForStartupAuditEvent(t, listener, 1, 1)
+		waitForLeaderToBeElected(t, nhs[0], 1)
+		for i := 0; i < 5; i++ {
+			if v := readCloneTestValue(t,
+				nhs[0], 1, fmt.Sprintf("k%d", i)); v != fmt.Sprintf("%d", i) {
+				t.Errorf("key k%d, value %s", i, v)
+			}
+		}
+		// consistent now, nothing to report
+		listener = restartAuditTestNodeHost(t, nhs, false)
+		if err := nhs[0].StartReplica(nil,
+			false, newCloneTestSM, auditTestReplicaConfig); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+		waitForLeaderToBeElected(t, nhs[0], 1)
+		if events := listener.getStartupAuditEvents(); len(events) != 0 {
+			t.Errorf("unexpected events %v", events)
+		}
+	}
+	memTransportNodeHostTest(t, 1, tf, fs)
+}
+
+func TestStartupAuditChecksOnDiskIndex(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := map[uint64]string{1: memtransport.Address(1)}
+		start := func(initialApplied uint64) error {
+			create := func(uint64, uint64) sm.IOnDiskStateMachine {
+				return tests.NewFakeDiskSM(initialApplied)
+			}
+			return nhs[0].StartOnDiskReplica(members,
+				false, create, auditTestReplicaConfig)
+		}
+		if err := start(0); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+		waitForLeaderToBeElected(t, nhs[0], 1)
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(nhs[0]))
+		defer cancel()
+		for i := 0; i < 5; i++ {
+			if _, err := nhs[0].SyncPropose(ctx,
+				nhs[0].GetNoOPSession(1), []byte("test-data")); err != nil {
+				t.Fatalf("failed to propose %v", err)
+			}
+		}
+		// the state machine claims entries never saved in the LogDB
+		listener := restartAuditTestNodeHost(t, nhs, true)
+		_, lastIndex := getAuditTestLastIndex(t, nhs[0])
+		checkStartupAuditError(t, start(lastIndex+10), AuditOnDiskIndex)
+		waitForStartupAuditEvent(t, listener, 1, 0)
+		// the state machine applied entries not recorded as committed
+		setAuditTestCommit(t, nhs[0], lastIndex-2)
+		listener = restartAuditTestNodeHost(t, nhs, false)
+		checkStartupAuditError(t, start(lastIndex), AuditOnDiskIndex)
+		waitForStartupAuditEvent(t, listener, 1, 0)
+		listener = restartAuditTestNodeHost(t, nhs, true)
+		if err := start(lastIndex); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+		waitForStartupAuditEvent(t, listener, 1, 1)
+		waitForLeaderToBeElected(t, nhs[0], 1)
+		if _, err := nhs[0].SyncPropose(ctx,
+			nhs[0].GetNoOPSession(1), []byte("test-data")); err != nil {
+			t.Fatalf("failed to propose %v", err)
+		}
+	}
+	memTransportNodeHostTest(t, 1, tf, fs)
+}
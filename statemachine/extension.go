@@ -36,6 +36,31 @@ type IHash interface {
 	GetHash() (uint64, error)
 }
 
+// IFingerprint is an optional interface to be implemented by a user state
+// machine type to have divergence between replicas detected. The fingerprint
+// is recorded alongside the metadata of each snapshot, replicas recovered from
+// a received snapshot compare the recorded fingerprint with the one computed
+// after RecoverFromSnapshot returns.
+type IFingerprint interface {
+	// Fingerprint returns a deterministic hash of the state machine state.
+	// Replicas with the same Raft Log entries applied must return the same
+	// fingerprint, state that is not part of snapshots must thus be excluded.
+	// 0 is reserved to indicate that no fingerprint is available.
+	//
+	// Fingerprint is a read-only operation, it is never invoked concurrently
+	// with Update.
+	Fingerprint() (uint64, error)
+}
+
+// IDataDir is an optional interface to be implemented by a user
+// IOnDiskStateMachine type to have the free space of its data directory
+// monitored, see config.DiskMonitorConfig for details.
+type IDataDir interface {
+	// DataDir returns the root directory used for storing the data of the state
+	// machine. It is invoked once after the state machine is created.
+	DataDir() string
+}
+
 // IExtended is an optional interface to be implemented by a user state machine
 // type, most of its member methods are for performance optimization purposes.
 type IExtended interface {
@@ -49,3 +74,34 @@ type IExtended interface {
 	// state.
 	NALookup([]byte) ([]byte, error)
 }
+
+// IByteLookup is an optional interface to be implemented by a user state
+// machine type for serving byte oriented reads. When implemented, it is used
+// by NodeHost's NAReadLocalNode and NASyncRead methods in place of
+// IExtended.NALookup. Implementations are recommended to return a byte slice
+// that does not require any heap allocation, e.g. a slice referring to data
+// owned by the state machine, so reads can be served without any heap
+// allocation.
+//
+// LookupBytes is a read-only method, it should never change the state of the
+// state machine. The returned byte slice is handed to the caller without being
+// copied, it must not be modified by the state machine once returned.
+type IByteLookup interface {
+	// LookupBytes queries the state machine using the specified query byte
+	// slice and returns the result as a byte slice.
+	LookupBytes(query []byte) ([]byte, error)
+}
+
+// INonRetainingStateMachine is an optional interface to be implemented by a
+// user state machine type that never keeps a reference to the Cmd field of the
+// provided entries, or any part of it, after its Update method returns.
+//
+// The Cmd field of entries provided to such state machines might be backed by
+// buffers reused by dragonboat once Update returns, this allows payloads of
+// compressed entries to be decoded without per entry heap allocations. State
+// machines not implementing INonRetainingStateMachine always get Cmd values
+// that are never modified or reused by dragonboat.
+type INonRetainingStateMachine interface {
+	// NonRetaining is a marker method, it is never invoked.
+	NonRetaining()
+}
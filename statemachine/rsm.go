@@ -27,6 +27,7 @@ to update service state based on snapshots.
 package statemachine
 
 import (
+	"fmt"
 	"io"
 
 	"github.com/cockroachdb/errors"
@@ -106,6 +107,26 @@ type Result struct {
 	// NodeHost to query the state of their IStateMachine and IOnDiskStateMachine
 	// types, proposal based queries are known to work but are not recommended.
 	Data []byte
+	// Error is an optional application level error of the update operation.
+	// It is returned to the proposer as a *dragonboat.SMApplicationError by
+	// NodeHost's SyncPropose method. The entry is still considered as applied,
+	// the state machine must behave identically on all replicas regardless of
+	// the returned error.
+	Error *ApplicationError `json:",omitempty"`
+}
+
+// ApplicationError is an application level error returned by the Update
+// method of the state machine as a part of the Result.
+type ApplicationError struct {
+	// Code is the application defined error code.
+	Code uint64
+	// Message is the application defined error message.
+	Message string
+}
+
+func (e *ApplicationError) Error() string {
+	return fmt.Sprintf("application error, code %d, message %s",
+		e.Code, e.Message)
 }
 
 // Entry represents a Raft log entry that is going to be provided to the Update
@@ -119,6 +140,10 @@ type Entry struct {
 	// Result is the result value obtained from the Update method of an
 	// IConcurrentStateMachine or IOnDiskStateMachine instance.
 	Result Result
+	// RequestID is the ID of the client request that proposed the entry, it is
+	// only available when config.Config.PropagateRequestIDs is enabled on the
+	// replica that accepted the proposal. This field is strictly read-only.
+	RequestID []byte
 }
 
 // IStateMachine is the interface to be implemented by application's state
@@ -0,0 +1,337 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/raft"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	// defaultTailBufferSize is the default number of applied entries buffered
+	// for each tailing consumer.
+	defaultTailBufferSize = 1024
+	// tailReadBatchSize is the max total size in bytes of entries read from the
+	// LogDB in each batch when catching up.
+	tailReadBatchSize = 4 * 1024 * 1024
+)
+
+var (
+	// ErrLogCompacted indicates that the requested entries are no longer
+	// available in the LogDB as they have been compacted. The returned error
+	// is a *LogCompactedError value which contains the first available index.
+	ErrLogCompacted = errors.New("log compacted")
+	// ErrLagging indicates that the tailing consumer is too slow to keep up
+	// with the applied entries of the local replica.
+	ErrLagging = errors.New("tailing consumer lagging behind")
+	// ErrChunksUnavailable indicates that the payload of a chunked proposal can
+	// not be reassembled as its first chunk precedes the index from which the
+	// tailing started, tailing can be resumed from an earlier index.
+	ErrChunksUnavailable = errors.New("chunks of chunked proposal unavailable")
+)
+
+// LogCompactedError is the error returned by TailApplied when the requested
+// entries have been compacted from the LogDB. FirstIndex is the earliest
+// index still available in the LogDB at the time of the failure.
+type LogCompactedError struct {
+	ShardID    uint64
+	FirstIndex uint64
+}
+
+func (e *LogCompactedError) Error() string {
+	return fmt.Sprintf("shard %d: %s, first available index %d",
+		e.ShardID, ErrLogCompacted, e.FirstIndex)
+}
+
+// Is returns a boolean value indicating whether the target is
+// ErrLogCompacted.
+func (e *LogCompactedError) Is(target error) bool {
+	return target == ErrLogCompacted
+}
+
+// TailFunc is the function type invoked by TailApplied for each applied entry
+// in index order.
+type TailFunc func(index uint64, cmd []byte) error
+
+// TailOption is the option type used by TailAppliedWithOption.
+type TailOption struct {
+	// IncludeInternalEntries determines whether session management, membership
+	// change and empty entries should also be delivered. Such entries are
+	// delivered with a nil cmd so every index is observed, they are skipped by
+	// default.
+	IncludeInternalEntries bool
+	// BufferSize is the number of applied entries buffered for the consumer
+	// while the TailFunc is being invoked. The default value 0 means 1024
+	// entries are buffered.
+	BufferSize uint64
+}
+
+func (o TailOption) bufferSize() uint64 {
+	if o.BufferSize == 0 {
+		return defaultTailBufferSize
+	}
+	return o.BufferSize
+}
+
+// appliedTail is a consumer of the entries applied by the local replica.
+type appliedTail struct {
+	// entryC is closed by the apply worker when the consumer is lagging
+	entryC chan pb.Entry
+}
+
+// appliedTails contains the consumers of the entries applied by the local
+// replica. Entries are delivered to consumers without blocking, consumers not
+// draining their buffers fast enough are removed.
+type appliedTails struct {
+	mu    sync.Mutex
+	tails map[*appliedTail]struct{}
+	count int32
+}
+
+func (a *appliedTails) add(bufferSize uint64) *appliedTail {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.tails == nil {
+		a.tails = make(map[*appliedTail]struct{})
+	}
+	t := &appliedTail{entryC: make(chan pb.Entry, bufferSize)}
+	a.tails[t] = struct{}{}
+	atomic.AddInt32(&a.count, 1)
+	return t
+}
+
+func (a *appliedTails) remove(t *appliedTail) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.tails[t]; ok {
+		delete(a.tails, t)
+		atomic.AddInt32(&a.count, -1)
+	}
+}
+
+func (a *appliedTails) hasTails() bool {
+	return atomic.LoadInt32(&a.count) > 0
+}
+
+func (a *appliedTails) applied(entries []pb.Entry) {
+	if !a.hasTails() {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for t := range a.tails {
+		for _, e := range entries {
+			select {
+			case t.entryC <- e:
+				continue
+			default:
+			}
+			close(t.entryC)
+			delete(a.tails, t)
+			atomic.AddInt32(&a.count, -1)
+			break
+		}
+	}
+}
+
+// EntriesApplied is invoked by the apply worker with entries just applied by
+// the state machine.
+func (n *node) EntriesApplied(entries []pb.Entry) {
+	n.appliedTails.applied(entries)
+}
+
+// appliedTailer delivers applied entries of a replica to a TailFunc.
+type appliedTailer struct {
+	n      *node
+	ctx    context.Context
+	fn     TailFunc
+	start  uint64
+	next   uint64
+	opt    TailOption
+	chunks rsm.ChunkAssembler
+}
+
+func (n *node) tailApplied(ctx context.Context,
+	fromIndex uint64, opt TailOption, fn TailFunc) error {
+	// registered before getting the applied index, entries applied after that
+	// are guaranteed to be buffered unless the consumer is lagging
+	t := n.appliedTails.add(opt.bufferSize())
+	defer n.appliedTails.remove(t)
+	at := &appliedTailer{n: n, ctx: ctx, fn: fn, next: fromIndex, opt: opt}
+	if at.next == 0 {
+		at.next = 1
+	}
+	at.start = at.next
+	if err := at.catchUp(n.sm.GetLastApplied() + 1); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return getContextError(ctx)
+		case <-n.stopC:
+			return ErrShardClosed
+		case e, ok := <-t.entryC:
+			if !ok {
+				return ErrLagging
+			}
+			if e.Index < at.next {
+				continue
+			}
+			// entries not delivered to the consumer, e.g. when the replica is
+			// restored from a snapshot, are read from the LogDB
+			if err := at.catchUp(e.Index); err != nil {
+				return err
+			}
+			if err := at.deliver(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// catchUp delivers entries in [next, high) read from the LogDB.
+func (at *appliedTailer) catchUp(high uint64) error {
+	for at.next < high {
+		if err := at.ctx.Err(); err != nil {
+			return getContextError(at.ctx)
+		}
+		entries, err := at.n.logReader.Entries(at.next, high, tailReadBatchSize)
+		if err != nil {
+			if errors.Is(err, raft.ErrCompacted) {
+				first, _ := at.n.logReader.GetRange()
+				return &LogCompactedError{
+					ShardID:    at.n.shardID,
+					FirstIndex: first,
+				}
+			}
+			return err
+		}
+		for _, e := range entries {
+			if err := at.deliver(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (at *appliedTailer) deliver(e pb.Entry) error {
+	if e.Index != at.next {
+		plog.Panicf("%s unexpected entry index %d, want %d",
+			at.n.id(), e.Index, at.next)
+	}
+	at.next++
+	if rsm.IsChunkedEntry(e) {
+		return at.deliverChunked(e)
+	}
+	if e.IsUpdateEntry() && e.Type != pb.MetadataEntry {
+		cmd, err := rsm.GetPayload(e)
+		if err != nil {
+			return err
+		}
+		return at.fn(e.Index, cmd)
+	}
+	return at.deliverInternal(e)
+}
+
+// deliverChunked delivers the reassembled payload of a chunked proposal at
+// the index of its manifest entry, chunk entries are internal entries.
+func (at *appliedTailer) deliverChunked(e pb.Entry) error {
+	if !rsm.IsChunkManifest(e) {
+		if err := at.chunks.Add(e); err != nil {
+			return err
+		}
+		return at.deliverInternal(e)
+	}
+	cmd, ok, observed := at.chunks.Take(e)
+	if !observed && at.start > 1 {
+		return errors.Wrapf(ErrChunksUnavailable,
+			"%s manifest at index %d, tailing started at %d",
+			at.n.id(), e.Index, at.start)
+	}
+	if !ok {
+		// the proposal is rejected by the state machine as well
+		return at.deliverInternal(e)
+	}
+	return at.fn(e.Index, cmd)
+}
+
+func (at *appliedTailer) deliverInternal(e pb.Entry) error {
+	if at.opt.IncludeInternalEntries {
+		return at.fn(e.Index, nil)
+	}
+	return nil
+}
+
+func getContextError(ctx context.Context) error {
+	if ctx.Err() == context.Canceled {
+		return ErrCanceled
+	}
+	return ErrTimeout
+}
+
+// TailApplied delivers entries applied by the local replica of the specified
+// shard to fn, starting from fromIndex. Entries still available in the LogDB
+// are replayed first, once caught up, entries are delivered as they are
+// applied by the local state machine. Entries are delivered in index order
+// without gaps, they can be delivered again after TailApplied returns and is
+// invoked again from an earlier index, i.e. at-least-once delivery when the last
+// delivered index is persisted by the consumer. Only regular proposals are
+// delivered. The reassembled payload of a chunked proposal, see
+// config.Config.MaxEntryChunkBytes, is delivered at the index of its manifest
+// entry, its chunk entries are internal entries. See TailAppliedWithOption for
+// delivering other entries.
+//
+// TailApplied blocks until fn returns an error, the specified context is done
+// or the replica is stopped. The error returned by fn is returned as is. A
+// *LogCompactedError error, matching ErrLogCompacted, is returned when the
+// requested entries have been compacted from the LogDB. ErrChunksUnavailable
+// is returned when the manifest entry of a chunked proposal is reached but the
+// proposal started before fromIndex. As fn is not allowed to block the apply
+// loop of the replica, ErrLagging is returned when the consumer falls too far
+// behind, it can resume from the next index it expects to receive.
+func (nh *NodeHost) TailApplied(ctx context.Context, shardID uint64,
+	fromIndex uint64, fn TailFunc) error {
+	return nh.TailAppliedWithOption(ctx, shardID, fromIndex, TailOption{}, fn)
+}
+
+// TailAppliedWithOption is similar to TailApplied, it allows the caller to
+// specify the TailOption.
+func (nh *NodeHost) TailAppliedWithOption(ctx context.Context, shardID uint64,
+	fromIndex uint64, opt TailOption, fn TailFunc) error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return ErrShardNotFound
+	}
+	if n.isWitness() {
+		return ErrInvalidOperation
+	}
+	if !n.initialized() {
+		return ErrShardNotReady
+	}
+	return n.tailApplied(ctx, fromIndex, opt, fn)
+}
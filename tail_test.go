@@ -0,0 +1,317 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+type tailedEntry struct {
+	index uint64
+	cmd   string
+}
+
+func proposeTestData(t *testing.T, nh *NodeHost, prefix string, count int) {
+	session := nh.GetNoOPSession(1)
+	for i := 0; i < count; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+		cmd := []byte(fmt.Sprintf("%s-%d", prefix, i))
+		_, err := nh.SyncPropose(ctx, session, cmd)
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to make proposal, %v", err)
+		}
+	}
+}
+
+func startTailing(nh *NodeHost, ctx context.Context, fromIndex uint64,
+	opt TailOption) (chan tailedEntry, chan error) {
+	entryC := make(chan tailedEntry, 1024)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- nh.TailAppliedWithOption(ctx, 1, fromIndex, opt,
+			func(index uint64, cmd []byte) error {
+				entryC <- tailedEntry{index: index, cmd: string(cmd)}
+				return nil
+			})
+	}()
+	return entryC, errC
+}
+
+func getTailedEntries(t *testing.T, entryC chan tailedEntry,
+	count int) []tailedEntry {
+	var result []tailedEntry
+	for len(result) < count {
+		select {
+		case e := <-entryC:
+			result = append(result, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only got %d entries, want %d", len(result), count)
+		}
+	}
+	return result
+}
+
+func TestTailAppliedSwitchesToLiveDelivery(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			proposeTestData(t, nh, "replayed", 5)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			entryC, errC := startTailing(nh, ctx, 0, TailOption{})
+			replayed := getTailedEntries(t, entryC, 5)
+			proposeTestData(t, nh, "live", 5)
+			live := getTailedEntries(t, entryC, 5)
+			tailed := append(replayed, live...)
+			for i, e := range tailed {
+				want := fmt.Sprintf("replayed-%d", i)
+				if i >= 5 {
+					want = fmt.Sprintf("live-%d", i-5)
+				}
+				if e.cmd != want {
+					t.Errorf("%d, got %s, want %s", i, e.cmd, want)
+				}
+				// proposals are the only entries in this test after the first one
+				if i > 0 && e.index != tailed[i-1].index+1 {
+					t.Errorf("%d, unexpected index %d", i, e.index)
+				}
+			}
+			cancel()
+			if err := <-errC; !errors.Is(err, ErrCanceled) {
+				t.Errorf("unexpected error %v", err)
+			}
+			// internal entries are delivered with nil cmd, no index is skipped
+			ctx, cancel = context.WithCancel(context.Background())
+			defer cancel()
+			opt := TailOption{IncludeInternalEntries: true}
+			entryC, _ = startTailing(nh, ctx, 1, opt)
+			all := getTailedEntries(t, entryC, int(live[4].index))
+			for i, e := range all {
+				if e.index != uint64(i+1) {
+					t.Fatalf("%d, unexpected index %d", i, e.index)
+				}
+			}
+			if all[0].cmd != "" || all[live[4].index-1].cmd != "live-4" {
+				t.Errorf("unexpected entries %v", all)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestTailAppliedReportsCompactedLog(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.SnapshotEntries = 0
+			c.CompactionOverhead = 0
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			proposeTestData(t, nh, "compacted", 5)
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			opt := SnapshotOption{
+				OverrideCompactionOverhead: true,
+				CompactionOverhead:         0,
+			}
+			if _, err := nh.SyncRequestSnapshot(ctx, 1, opt); err != nil {
+				t.Fatalf("failed to request snapshot %v", err)
+			}
+			lr, err := nh.GetLogReader(1)
+			if err != nil {
+				t.Fatalf("failed to get log reader, %v", err)
+			}
+			for i := 0; i < 500; i++ {
+				if first, _ := lr.GetRange(); first > 1 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			first, _ := lr.GetRange()
+			if first <= 1 {
+				t.Fatalf("log not compacted")
+			}
+			proposeTestData(t, nh, "retained", 2)
+			done := errors.New("done")
+			err = nh.TailApplied(ctx, 1, 1, func(uint64, []byte) error {
+				t.Errorf("unexpectedly delivered")
+				return done
+			})
+			var ce *LogCompactedError
+			if !errors.Is(err, ErrLogCompacted) || !errors.As(err, &ce) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if ce.FirstIndex != first || ce.ShardID != 1 {
+				t.Errorf("unexpected error %+v, first index %d", ce, first)
+			}
+			// resumed from the first available index
+			var cmds []string
+			err = nh.TailApplied(ctx, 1, ce.FirstIndex,
+				func(index uint64, cmd []byte) error {
+					if index < ce.FirstIndex {
+						t.Errorf("unexpected index %d", index)
+					}
+					cmds = append(cmds, string(cmd))
+					if string(cmd) == "retained-1" {
+						return done
+					}
+					return nil
+				})
+			if !errors.Is(err, done) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if len(cmds) != 2 || cmds[0] != "retained-0" {
+				t.Errorf("unexpected cmds %v", cmds)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestSlowTailConsumerIsReportedAsLagging(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			proposeTestData(t, nh, "existing", 1)
+			n, ok := nh.getShard(1)
+			if !ok {
+				t.Fatalf("failed to get node")
+			}
+			fromIndex := n.sm.GetLastApplied() + 1
+			calledC := make(chan struct{}, 1)
+			unblockC := make(chan struct{})
+			errC := make(chan error, 1)
+			go func() {
+				opt := TailOption{BufferSize: 2}
+				errC <- nh.TailAppliedWithOption(context.Background(), 1, fromIndex,
+					opt, func(uint64, []byte) error {
+						select {
+						case calledC <- struct{}{}:
+						default:
+						}
+						<-unblockC
+						return nil
+					})
+			}()
+			// wait for the consumer to be registered
+			for i := 0; i < 500 && !n.appliedTails.hasTails(); i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			proposeTestData(t, nh, "blocked", 1)
+			<-calledC
+			// the apply loop is not blocked by the consumer
+			proposeTestData(t, nh, "lagging", 5)
+			close(unblockC)
+			if err := <-errC; !errors.Is(err, ErrLagging) {
+				t.Errorf("unexpected error %v", err)
+			}
+			if n.appliedTails.hasTails() {
+				t.Errorf("lagging consumer not removed")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestLaggingTailIsRemoved(t *testing.T) {
+	a := &appliedTails{}
+	slow := a.add(1)
+	fast := a.add(4)
+	a.applied([]pb.Entry{{Index: 1}, {Index: 2}})
+	if _, ok := <-slow.entryC; !ok {
+		t.Fatalf("buffered entry not delivered")
+	}
+	if _, ok := <-slow.entryC; ok {
+		t.Fatalf("channel of the lagging tail not closed")
+	}
+	if len(fast.entryC) != 2 {
+		t.Errorf("entries not delivered to fast tail")
+	}
+	a.remove(fast)
+	a.remove(slow)
+	if a.hasTails() {
+		t.Errorf("tails not removed")
+	}
+}
+
+func TestTailAppliedDeliversChunkedProposal(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		createSM: newCloneTestSM,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.MaxEntryChunkBytes = chunkTestChunkSize
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			payload := getChunkTestPayload("v")
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			if _, err := nh.SyncPropose(ctx,
+				nh.GetNoOPSession(1), payload); err != nil {
+				t.Fatalf("failed to propose %v", err)
+			}
+			n, ok := nh.getShard(1)
+			if !ok {
+				t.Fatalf("failed to get node")
+			}
+			manifest := n.sm.GetLastApplied()
+			ctx, cancel = context.WithCancel(context.Background())
+			defer cancel()
+			entryC, _ := startTailing(nh, ctx, 1, TailOption{})
+			e := getTailedEntries(t, entryC, 1)[0]
+			if e.index != manifest || e.cmd != string(payload) {
+				t.Errorf("unexpected entry at %d, size %d", e.index, len(e.cmd))
+			}
+			// chunk entries are internal entries
+			opt := TailOption{IncludeInternalEntries: true}
+			entryC, _ = startTailing(nh, ctx, 1, opt)
+			all := getTailedEntries(t, entryC, int(manifest))
+			for _, e := range all[:manifest-1] {
+				if e.cmd != "" {
+					t.Errorf("unexpected cmd at %d", e.index)
+				}
+			}
+			if all[manifest-1].cmd != string(payload) {
+				t.Errorf("payload not delivered at the manifest")
+			}
+			// the payload can't be reassembled when tailing from the middle of
+			// the chunk stream
+			_, errC := startTailing(nh, ctx, manifest-1, TailOption{})
+			select {
+			case err := <-errC:
+				if !errors.Is(err, ErrChunksUnavailable) {
+					t.Errorf("unexpected error %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("failed to get error")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
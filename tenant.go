@@ -0,0 +1,264 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Quota is the quota of a tenant on the NodeHost, it is shared by local
+// replicas of all shards of the tenant, see config.NodeHostConfig.TenantOf.
+type Quota struct {
+	// ProposalBytesPerSecond is the maximum rate in bytes per second of
+	// proposal payloads accepted by local replicas of the tenant's shards,
+	// proposals exceeding it are rejected with ErrRateLimited. Bursts of up to
+	// one second worth of payloads are accepted. When set to 0, it means the
+	// proposal rate is unlimited.
+	ProposalBytesPerSecond uint64
+	// SnapshotBytesPerSecond is the maximum rate in bytes per second at which
+	// snapshot data is written by snapshot operations of local replicas of the
+	// tenant's shards. Snapshot operations are slowed down rather than failed,
+	// config.NodeHostConfig.MaxSnapshotWriteBytesPerSecond still applies. When
+	// set to 0, it means the snapshot write rate is unlimited.
+	SnapshotBytesPerSecond uint64
+}
+
+// TenantStats contains the quota usage of a tenant on the NodeHost, counters
+// are cumulative since the NodeHost was started.
+type TenantStats struct {
+	// Tenant is the name of the tenant.
+	Tenant string
+	// Quota is the current quota of the tenant.
+	Quota Quota
+	// ProposalBytes is the total size of proposal payloads accepted.
+	ProposalBytes uint64
+	// RateLimited is the number of proposals rejected with ErrRateLimited.
+	RateLimited uint64
+	// Snapshot contains the stats of snapshot data written.
+	Snapshot SnapshotWriteStats
+	// Memory is the memory used by local replicas of the tenant's shards, see
+	// MemoryStats.Tenants.
+	Memory uint64
+}
+
+// tenantQuota enforces the quota of a tenant. Proposals are admitted by a
+// token bucket refilled at ProposalBytesPerSecond and holding at most one
+// second worth of tokens, a proposal is admitted as long as the bucket is not
+// empty so proposals larger than the bucket are never starved, the bucket is
+// overdrawn in that case and the overdraft is repaid before the next
+// proposal is admitted. All methods can be invoked on a nil tenantQuota,
+// nothing is limited or recorded in that case.
+type tenantQuota struct {
+	name     string
+	clock    func() time.Time
+	snapshot *snapshotWriteLimiter
+	metrics  *tenantMetrics
+	accepted uint64
+	limited  uint64
+	mu       struct {
+		sync.Mutex
+		quota  Quota
+		tokens float64
+		last   time.Time
+	}
+}
+
+func newTenantQuota(name string, clock func() time.Time) *tenantQuota {
+	return &tenantQuota{
+		name:     name,
+		clock:    clock,
+		snapshot: newSnapshotWriteLimiter(0),
+	}
+}
+
+// setQuota updates the quota, the proposal token bucket is refilled when the
+// proposal rate is changed.
+func (t *tenantQuota) setQuota(q Quota) {
+	t.mu.Lock()
+	if q.ProposalBytesPerSecond != t.mu.quota.ProposalBytesPerSecond {
+		t.mu.tokens = float64(q.ProposalBytesPerSecond)
+		t.mu.last = t.clock()
+	}
+	t.mu.quota = q
+	t.mu.Unlock()
+	t.snapshot.setLimit(q.SnapshotBytesPerSecond)
+}
+
+func (t *tenantQuota) getQuota() Quota {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.mu.quota
+}
+
+// admit returns a boolean value indicating whether a proposal of the
+// specified size is permitted by the quota.
+func (t *tenantQuota) admit(sz uint64) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	ok := true
+	if limit := t.mu.quota.ProposalBytesPerSecond; limit > 0 {
+		now := t.clock()
+		if elapsed := now.Sub(t.mu.last); elapsed > 0 {
+			t.mu.tokens += elapsed.Seconds() * float64(limit)
+			if t.mu.tokens > float64(limit) {
+				t.mu.tokens = float64(limit)
+			}
+			t.mu.last = now
+		}
+		if t.mu.tokens > 0 {
+			t.mu.tokens -= float64(sz)
+		} else {
+			ok = false
+		}
+	}
+	t.mu.Unlock()
+	if ok {
+		atomic.AddUint64(&t.accepted, sz)
+		t.metrics.proposalAccepted(sz)
+	} else {
+		atomic.AddUint64(&t.limited, 1)
+		t.metrics.rateLimited()
+	}
+	return ok
+}
+
+func (t *tenantQuota) rateLimited() uint64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&t.limited)
+}
+
+func (t *tenantQuota) snapshotLimiter() *snapshotWriteLimiter {
+	if t == nil {
+		return nil
+	}
+	return t.snapshot
+}
+
+func (t *tenantQuota) stats() TenantStats {
+	return TenantStats{
+		Tenant:        t.name,
+		Quota:         t.getQuota(),
+		ProposalBytes: atomic.LoadUint64(&t.accepted),
+		RateLimited:   atomic.LoadUint64(&t.limited),
+		Snapshot:      t.snapshot.stats(),
+	}
+}
+
+// tenantRegistry contains the tenantQuota instances of all tenants on the
+// NodeHost. Tenants are added when their quotas are set or when replicas of
+// their shards are started, they are never removed.
+type tenantRegistry struct {
+	tenantOf func(uint64) string
+	clock    func() time.Time
+	metrics  *nodeHostMetrics
+	memory   *memoryAccountant
+	mu       struct {
+		sync.Mutex
+		tenants map[string]*tenantQuota
+	}
+}
+
+func newTenantRegistry(tenantOf func(uint64) string,
+	clock func() time.Time, metrics *nodeHostMetrics,
+	memory *memoryAccountant) *tenantRegistry {
+	r := &tenantRegistry{
+		tenantOf: tenantOf,
+		clock:    clock,
+		metrics:  metrics,
+		memory:   memory,
+	}
+	r.mu.tenants = make(map[string]*tenantQuota)
+	return r
+}
+
+func (r *tenantRegistry) enabled() bool {
+	return r.tenantOf != nil
+}
+
+// get returns the tenantQuota of the specified tenant, it is created when
+// the tenant is unknown.
+func (r *tenantRegistry) get(name string) *tenantQuota {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.mu.tenants[name]
+	if !ok {
+		t = newTenantQuota(name, r.clock)
+		t.metrics = r.metrics.newTenantMetrics(t, r.memory)
+		r.mu.tenants[name] = t
+	}
+	return t
+}
+
+func (r *tenantRegistry) lookup(name string) (*tenantQuota, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.mu.tenants[name]
+	return t, ok
+}
+
+// getShardTenant returns the tenantQuota of the tenant of the specified
+// shard, nil is returned when the shard has no tenant.
+func (r *tenantRegistry) getShardTenant(shardID uint64) *tenantQuota {
+	if !r.enabled() {
+		return nil
+	}
+	name := r.tenantOf(shardID)
+	if len(name) == 0 {
+		return nil
+	}
+	return r.get(name)
+}
+
+// SetTenantQuota sets the quota of the specified tenant, it is shared by local
+// replicas of all shards of the tenant and it takes effect immediately,
+// including for proposals and snapshot operations of replicas already
+// running. Proposals exceeding the quota are rejected with ErrRateLimited.
+// The tenant of each shard is determined by config.NodeHostConfig.TenantOf,
+// ErrInvalidOperation is returned when it is not set or when the specified
+// tenant is empty.
+func (nh *NodeHost) SetTenantQuota(tenant string, q Quota) error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	if !nh.tenants.enabled() || len(tenant) == 0 {
+		return ErrInvalidOperation
+	}
+	nh.tenants.get(tenant).setQuota(q)
+	return nil
+}
+
+// GetTenantStats returns the quota usage of the specified tenant on the
+// NodeHost. ErrInvalidOperation is returned when
+// config.NodeHostConfig.TenantOf is not set.
+func (nh *NodeHost) GetTenantStats(tenant string) (TenantStats, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return TenantStats{}, ErrClosed
+	}
+	if !nh.tenants.enabled() {
+		return TenantStats{}, ErrInvalidOperation
+	}
+	stats := TenantStats{Tenant: tenant}
+	if t, ok := nh.tenants.lookup(tenant); ok {
+		stats = t.stats()
+	}
+	stats.Memory = nh.getMemoryStats().Tenants[tenant]
+	return stats, nil
+}
@@ -0,0 +1,283 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func TestTenantQuotaAdmitsProposalsAtTheConfiguredRate(t *testing.T) {
+	now := time.Unix(1000, 0)
+	q := newTenantQuota("a", func() time.Time { return now })
+	// unlimited by default
+	for i := 0; i < 100; i++ {
+		if !q.admit(1000) {
+			t.Fatalf("proposal rejected when unlimited")
+		}
+	}
+	q.setQuota(Quota{ProposalBytesPerSecond: 1000})
+	// a full bucket admits a burst of one second worth of bytes
+	for i := 0; i < 4; i++ {
+		if !q.admit(250) {
+			t.Fatalf("%d, burst rejected", i)
+		}
+	}
+	if q.admit(1) {
+		t.Errorf("proposal admitted from an empty bucket")
+	}
+	now = now.Add(100 * time.Millisecond)
+	// proposals larger than the refilled tokens overdraw the bucket
+	if !q.admit(500) {
+		t.Errorf("proposal rejected")
+	}
+	now = now.Add(300 * time.Millisecond)
+	if q.admit(1) {
+		t.Errorf("overdraft not repaid")
+	}
+	// the bucket never holds more than one second worth of bytes
+	now = now.Add(time.Hour)
+	for i := 0; i < 4; i++ {
+		if !q.admit(250) {
+			t.Fatalf("%d, burst rejected", i)
+		}
+	}
+	if q.admit(1) {
+		t.Errorf("bucket not capped")
+	}
+	stats := q.stats()
+	if stats.RateLimited != 3 || stats.ProposalBytes != 102500 ||
+		stats.Quota.ProposalBytesPerSecond != 1000 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	// changing the quota takes effect immediately
+	q.setQuota(Quota{})
+	if !q.admit(1) {
+		t.Errorf("proposal rejected when unlimited")
+	}
+	var nq *tenantQuota
+	if !nq.admit(1) || nq.rateLimited() != 0 || nq.snapshotLimiter() != nil {
+		t.Errorf("unexpected nil tenantQuota behavior")
+	}
+}
+
+func TestTenantQuotaSetsTheSnapshotWriteLimit(t *testing.T) {
+	q := newTenantQuota("a", time.Now)
+	q.setQuota(Quota{SnapshotBytesPerSecond: 1024})
+	if v := q.snapshotLimiter().stats().Limit; v != 1024 {
+		t.Errorf("limit %d, want 1024", v)
+	}
+	q.setQuota(Quota{})
+	if v := q.snapshotLimiter().stats().Limit; v != 0 {
+		t.Errorf("limit %d, want 0", v)
+	}
+}
+
+func TestTenantQuotaRequiresTenantOf(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			if err := nh.SetTenantQuota("a", Quota{}); err != ErrInvalidOperation {
+				t.Errorf("unexpected error %v", err)
+			}
+			if _, err := nh.GetTenantStats("a"); err != ErrInvalidOperation {
+				t.Errorf("unexpected error %v", err)
+			}
+			stats, err := nh.GetErrorStats(1)
+			if err != nil {
+				t.Fatalf("failed to get error stats %v", err)
+			}
+			if stats.Tenant != "" || nh.GetEngineStats().Memory.Tenants != nil {
+				t.Errorf("unexpected tenant")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestTenantQuotasIsolateThroughput(t *testing.T) {
+	const limit = 16 * 1024
+	fs := vfs.GetTestFS()
+	tenantOf := func(shardID uint64) string {
+		if shardID == 1 {
+			return "noisy"
+		}
+		return "quiet"
+	}
+	to := &testOption{
+		defaultTestNode: true,
+		updateNodeHostConfig: func(nhc *config.NodeHostConfig) *config.NodeHostConfig {
+			nhc.TenantOf = tenantOf
+			nhc.EnableMetrics = true
+			return nhc
+		},
+		tf: func(nh *NodeHost) {
+			cfg := getTestConfig()
+			cfg.ShardID = 2
+			peers := map[uint64]string{1: nh.RaftAddress()}
+			if err := nh.StartReplica(peers, false,
+				func(uint64, uint64) sm.IStateMachine { return &PST{} }, *cfg); err != nil {
+				t.Fatalf("failed to start shard 2, %v", err)
+			}
+			waitForLeaderToBeElected(t, nh, 1)
+			waitForLeaderToBeElected(t, nh, 2)
+			if err := nh.SetTenantQuota("", Quota{}); err != ErrInvalidOperation {
+				t.Errorf("unexpected error %v", err)
+			}
+			if err := nh.SetTenantQuota("noisy",
+				Quota{ProposalBytesPerSecond: limit}); err != nil {
+				t.Fatalf("failed to set quota %v", err)
+			}
+			if err := nh.SetTenantQuota("quiet",
+				Quota{ProposalBytesPerSecond: 1024 * 1024 * 1024}); err != nil {
+				t.Fatalf("failed to set quota %v", err)
+			}
+			data := make([]byte, 1024)
+			var accepted [2]uint64
+			var limited [2]uint64
+			var wg sync.WaitGroup
+			start := time.Now()
+			deadline := start.Add(time.Second)
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(idx int) {
+					defer wg.Done()
+					session := nh.GetNoOPSession(uint64(idx + 1))
+					for time.Now().Before(deadline) {
+						rs, err := nh.Propose(session, data, pto(nh))
+						if err == ErrRateLimited {
+							atomic.AddUint64(&limited[idx], 1)
+							time.Sleep(time.Millisecond)
+							continue
+						}
+						if err != nil {
+							t.Errorf("failed to make proposal, %v", err)
+							return
+						}
+						r := <-rs.ResultC()
+						rs.Release()
+						if r.Completed() {
+							atomic.AddUint64(&accepted[idx], uint64(len(data)))
+						}
+					}
+				}(i % 2)
+			}
+			wg.Wait()
+			elapsed := time.Since(start)
+			// the noisy tenant is capped at its quota plus the initial burst
+			bound := uint64(elapsed.Seconds()*limit) + limit + uint64(len(data))
+			if accepted[0] == 0 || accepted[0] > bound {
+				t.Errorf("noisy tenant accepted %d bytes, max %d", accepted[0], bound)
+			}
+			if limited[0] == 0 {
+				t.Errorf("noisy tenant not rate limited")
+			}
+			if limited[1] != 0 {
+				t.Errorf("quiet tenant rate limited %d times", limited[1])
+			}
+			if accepted[1] < 4*accepted[0] {
+				t.Errorf("quiet tenant accepted %d bytes, noisy tenant %d bytes",
+					accepted[1], accepted[0])
+			}
+			noisy, err := nh.GetTenantStats("noisy")
+			if err != nil {
+				t.Fatalf("failed to get tenant stats %v", err)
+			}
+			if noisy.RateLimited != limited[0] ||
+				noisy.ProposalBytes < accepted[0] ||
+				noisy.Quota.ProposalBytesPerSecond != limit {
+				t.Errorf("unexpected noisy tenant stats %+v", noisy)
+			}
+			quiet, err := nh.GetTenantStats("quiet")
+			if err != nil {
+				t.Fatalf("failed to get tenant stats %v", err)
+			}
+			if quiet.RateLimited != 0 || quiet.ProposalBytes < accepted[1] {
+				t.Errorf("unexpected quiet tenant stats %+v", quiet)
+			}
+			es, err := nh.GetErrorStats(1)
+			if err != nil {
+				t.Fatalf("failed to get error stats %v", err)
+			}
+			if es.Tenant != "noisy" || es.TenantRateLimited != limited[0] ||
+				es.Proposals.Errors[ErrRateLimited] != limited[0] {
+				t.Errorf("unexpected error stats %+v", es)
+			}
+			es, err = nh.GetErrorStats(2)
+			if err != nil {
+				t.Fatalf("failed to get error stats %v", err)
+			}
+			if es.Tenant != "quiet" || es.TenantRateLimited != 0 {
+				t.Errorf("unexpected error stats %+v", es)
+			}
+			m := scrapeMetrics(t)
+			name := `dragonboat_tenant_rate_limited_total{tenant="noisy"}`
+			// counters are process wide
+			if v := m[name]; uint64(v) < limited[0] {
+				t.Errorf("%s is %f, want >= %d", name, v, limited[0])
+			}
+			name = `dragonboat_tenant_proposal_bytes_total{tenant="quiet"}`
+			if v := m[name]; uint64(v) < accepted[1] {
+				t.Errorf("%s is %f, want >= %d", name, v, accepted[1])
+			}
+			tenants := nh.GetEngineStats().Memory.Tenants
+			if _, ok := tenants["noisy"]; !ok {
+				t.Errorf("memory not attributed to tenant, %v", tenants)
+			}
+			if _, ok := tenants["quiet"]; !ok {
+				t.Errorf("memory not attributed to tenant, %v", tenants)
+			}
+			// quota changes take effect without restart
+			if err := nh.SetTenantQuota("noisy",
+				Quota{SnapshotBytesPerSecond: 1024 * 1024}); err != nil {
+				t.Fatalf("failed to set quota %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			session := nh.GetNoOPSession(1)
+			for i := 0; i < 16; i++ {
+				if _, err := nh.SyncPropose(ctx, session, data); err != nil {
+					t.Fatalf("failed to make proposal, %v", err)
+				}
+			}
+			if _, err := nh.SyncRequestSnapshot(ctx, 1, SnapshotOption{}); err != nil {
+				t.Fatalf("failed to request snapshot %v", err)
+			}
+			noisy, err = nh.GetTenantStats("noisy")
+			if err != nil {
+				t.Fatalf("failed to get tenant stats %v", err)
+			}
+			if noisy.Snapshot.Limit != 1024*1024 || noisy.Snapshot.TotalBytes == 0 {
+				t.Errorf("unexpected snapshot stats %+v", noisy.Snapshot)
+			}
+			quiet, err = nh.GetTenantStats("quiet")
+			if err != nil {
+				t.Fatalf("failed to get tenant stats %v", err)
+			}
+			if quiet.Snapshot.TotalBytes != 0 {
+				t.Errorf("snapshot attributed to the quiet tenant")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
@@ -0,0 +1,156 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// tickedShard is the tick state of a shard tracked by the tickScheduler.
+type tickedShard struct {
+	n *node
+	// ticked is the most recent tick sent to the shard.
+	ticked uint64
+	// deadline is the tick in which the shard is ticked again when idle.
+	deadline uint64
+	idle     bool
+}
+
+// tickScheduler selects the shards to be ticked in each tick of the tick
+// worker. Shards not in quiesce mode are ticked in every tick. Quiesced shards
+// do nothing but counting ticks, they are kept idle in a time wheel and only
+// ticked once every ElectionRTT ticks, in ticks selected by their ShardID.
+// Skipped ticks are caught up by the shard as quiesced ticks once it is ticked
+// again or before it handles any other event, see node.catchUpTicks. A shard
+// exiting quiesce mode is woken up and ticked in every tick again from the
+// next tick.
+//
+// Except wake, tickScheduler methods are only invoked by the tick worker.
+type tickScheduler struct {
+	tick   uint64
+	shards map[*node]*tickedShard
+	active []*tickedShard
+	wheel  map[uint64][]*tickedShard
+	ticked []*node
+	mu     sync.Mutex
+	woken  []*node
+}
+
+func newTickScheduler() *tickScheduler {
+	return &tickScheduler{
+		shards: make(map[*node]*tickedShard),
+		wheel:  make(map[uint64][]*tickedShard),
+	}
+}
+
+// getTick returns the most recent tick of the tick worker.
+func (s *tickScheduler) getTick() uint64 {
+	return atomic.LoadUint64(&s.tick)
+}
+
+// update sets the shards to be ticked, new shards are ticked in every tick
+// until they enter quiesce mode.
+func (s *tickScheduler) update(nodes []*node) {
+	current := make(map[*node]struct{}, len(nodes))
+	for _, n := range nodes {
+		current[n] = struct{}{}
+		if _, ok := s.shards[n]; !ok {
+			ts := &tickedShard{n: n, ticked: s.tick}
+			s.shards[n] = ts
+			s.active = append(s.active, ts)
+		}
+	}
+	for n, ts := range s.shards {
+		if _, ok := current[n]; !ok {
+			// removed from the active list or the wheel when visited
+			ts.n = nil
+			delete(s.shards, n)
+		}
+	}
+}
+
+// wake has the specified idle shard ticked in every tick again. It is invoked
+// by the step worker once the shard exited quiesce mode.
+func (s *tickScheduler) wake(n *node) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.woken = append(s.woken, n)
+}
+
+// next advances the tick and returns it together with the shards to be ticked
+// in it. The returned slice is reused in the next call.
+func (s *tickScheduler) next() (uint64, []*node) {
+	tick := atomic.AddUint64(&s.tick, 1)
+	s.mu.Lock()
+	woken := s.woken
+	s.woken = nil
+	s.mu.Unlock()
+	for _, n := range woken {
+		if ts, ok := s.shards[n]; ok && ts.idle {
+			ts.idle = false
+			s.active = append(s.active, ts)
+		}
+	}
+	s.ticked = s.ticked[:0]
+	active := s.active[:0]
+	for _, ts := range s.active {
+		if ts.n == nil {
+			continue
+		}
+		s.send(ts, tick)
+		if ts.n.tryIdleTicking() {
+			s.schedule(ts, tick)
+		} else {
+			active = append(active, ts)
+		}
+	}
+	for i := len(active); i < len(s.active); i++ {
+		s.active[i] = nil
+	}
+	s.active = active
+	due := s.wheel[tick]
+	delete(s.wheel, tick)
+	for _, ts := range due {
+		if ts.n == nil || !ts.idle || ts.deadline != tick {
+			continue
+		}
+		s.send(ts, tick)
+		s.schedule(ts, tick)
+	}
+	return tick, s.ticked
+}
+
+func (s *tickScheduler) send(ts *tickedShard, tick uint64) {
+	// the message queue of the shard is still ticked for skipped ticks, it
+	// keeps delayed messages for the requested number of ticks
+	for i := ts.ticked + 1; i < tick; i++ {
+		ts.n.mq.Tick()
+	}
+	ts.ticked = tick
+	s.ticked = append(s.ticked, ts.n)
+}
+
+func (s *tickScheduler) schedule(ts *tickedShard, tick uint64) {
+	interval := ts.n.config.ElectionRTT
+	if interval == 0 {
+		interval = 1
+	}
+	// idle shards are spread over the ticks of the interval by their ShardID
+	phase := ts.n.shardID % interval
+	ts.idle = true
+	ts.deadline = tick + 1 + (phase+interval-(tick+1)%interval)%interval
+	s.wheel[ts.deadline] = append(s.wheel[ts.deadline], ts)
+}
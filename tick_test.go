@@ -0,0 +1,112 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
+)
+
+func getTickTestNode(shardID uint64, quiesced bool) *node {
+	n := &node{
+		shardID: shardID,
+		config:  config.Config{ShardID: shardID, ElectionRTT: 5},
+		mq:      server.NewMessageQueue(16, false, 0, 0),
+		qs:      &quiesceState{enabled: true},
+	}
+	if quiesced {
+		atomic.StoreUint32(&n.qs.quiescedFlag, 1)
+		n.qs.quiescedSince = 1
+	}
+	return n
+}
+
+func countTicks(s *tickScheduler, n *node, ticks int) int {
+	count := 0
+	for i := 0; i < ticks; i++ {
+		_, ticked := s.next()
+		for _, v := range ticked {
+			if v == n {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func TestActiveShardIsTickedInEveryTick(t *testing.T) {
+	s := newTickScheduler()
+	n := getTickTestNode(1, false)
+	s.update([]*node{n})
+	if count := countTicks(s, n, 20); count != 20 {
+		t.Errorf("ticked %d times, want 20", count)
+	}
+	if s.getTick() != 20 {
+		t.Errorf("tick %d, want 20", s.getTick())
+	}
+}
+
+func TestQuiescedShardIsTickedOnceEveryElectionRTT(t *testing.T) {
+	s := newTickScheduler()
+	n := getTickTestNode(1, true)
+	s.update([]*node{n})
+	// ticked once before being found quiesced
+	if count := countTicks(s, n, 21); count != 5 {
+		t.Errorf("ticked %d times, want 5", count)
+	}
+	if atomic.LoadUint32(&n.idleTicking) != 1 {
+		t.Errorf("not idle ticking")
+	}
+	if len(s.active) != 0 {
+		t.Errorf("quiesced shard still active")
+	}
+}
+
+func TestWokenShardIsTickedInEveryTick(t *testing.T) {
+	s := newTickScheduler()
+	n := getTickTestNode(1, true)
+	n.ticker = s
+	s.update([]*node{n})
+	countTicks(s, n, 2)
+	n.qs.unquiesce()
+	n.wakeTicker()
+	if atomic.LoadUint32(&n.idleTicking) != 0 {
+		t.Errorf("still idle ticking")
+	}
+	if count := countTicks(s, n, 10); count != 10 {
+		t.Errorf("ticked %d times, want 10", count)
+	}
+}
+
+func TestRemovedShardIsNoLongerTicked(t *testing.T) {
+	s := newTickScheduler()
+	n1 := getTickTestNode(1, false)
+	n2 := getTickTestNode(2, true)
+	s.update([]*node{n1, n2})
+	countTicks(s, n1, 2)
+	s.update(nil)
+	if count := countTicks(s, n1, 10); count != 0 {
+		t.Errorf("removed active shard ticked %d times", count)
+	}
+	if count := countTicks(s, n2, 10); count != 0 {
+		t.Errorf("removed idle shard ticked %d times", count)
+	}
+	if len(s.active) != 0 || len(s.shards) != 0 {
+		t.Errorf("removed shards not cleared")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
+)
+
+var (
+	// ErrNotOwner indicates that the NodeHost directories are not owned by a
+	// NodeHost instance using the specified RaftAddress.
+	ErrNotOwner = server.ErrNotOwner
+	// ErrWALDirNotSupported indicates that the NodeHostConfig specifies a
+	// WALDir which is not supported by the requested operation.
+	ErrWALDirNotSupported = errors.New("WALDir not supported")
+)
+
+// ChangeRaftAddress allows the NodeHost directories of a stopped NodeHost
+// instance to be used with a new RaftAddress, e.g. when the NodeHost is moved
+// to a different port. nhConfig is the config to be used to restart the
+// NodeHost instance with its RaftAddress field set to the new address,
+// previous is the RaftAddress used so far.
+//
+// Replicas managed by the NodeHost are still known to other members of their
+// shards by their previous addresses, the address of each such replica should
+// be updated using NodeHost's SyncRequestUpdateReplicaAddress method before
+// the NodeHost is restarted. ChangeRaftAddress is not required when replicas
+// are addressed by NodeHostID values, ErrLockDirectory is returned when the
+// directories are locked by a running NodeHost instance.
+func ChangeRaftAddress(nhConfig config.NodeHostConfig, previous string) (err error) {
+	if err := prepareNodeHostConfig(&nhConfig); err != nil {
+		return err
+	}
+	env, err := server.NewEnv(nhConfig, nhConfig.Expert.FS)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, env.Close())
+	}()
+	if err := env.LockNodeHostDir(); err != nil {
+		return err
+	}
+	return env.ChangeRaftAddress(nhConfig, previous)
+}
+
+// RelocateNodeHostDir allows a NodeHost directory copied from another host,
+// e.g. one created by NodeHost's Checkpoint method, to be used as the
+// nhConfig.NodeHostDir of a NodeHost on the local host. Data of the copied
+// NodeHost is moved to be under the local hostname, the RaftAddress recorded
+// in the directory is changed to nhConfig.RaftAddress. nhConfig.WALDir must
+// be empty as the WAL is kept together with the rest of the copied LogDB.
+//
+// Replicas found in the directory are still known to their shards by their
+// previous addresses, the relocated NodeHost is expected to be used to form
+// new shards, e.g. when refreshing a dev or test environment.
+func RelocateNodeHostDir(nhConfig config.NodeHostConfig) (err error) {
+	if len(nhConfig.WALDir) > 0 {
+		return ErrWALDirNotSupported
+	}
+	if err := prepareNodeHostConfig(&nhConfig); err != nil {
+		return err
+	}
+	env, err := server.NewEnv(nhConfig, nhConfig.Expert.FS)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, env.Close())
+	}()
+	if err := env.LockNodeHostDir(); err != nil {
+		return err
+	}
+	return env.RelocateNodeHostDir(nhConfig)
+}
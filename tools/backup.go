@@ -0,0 +1,151 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"io"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/backup"
+	"github.com/lni/dragonboat/v4/internal/importer"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+var (
+	// ErrInvalidBackup indicates that the NodeHost backup is corrupted or is
+	// not in a supported format.
+	ErrInvalidBackup = backup.ErrInvalidBackup
+	// ErrNodeHostNotEmpty indicates that the NodeHost directories to restore
+	// the backup to already contain replicas.
+	ErrNodeHostNotEmpty = errors.New("NodeHost directory not empty")
+	// ErrBackupMismatch indicates that the backup was taken by a NodeHost with
+	// a different DeploymentID or RaftAddress.
+	ErrBackupMismatch = errors.New("backup does not match NodeHostConfig")
+)
+
+// BackupSource provides files of a NodeHost backup written by
+// NodeHost.Backup, files are opened using their slash separated paths
+// relative to the backup root.
+type BackupSource interface {
+	Open(name string) (io.ReadCloser, error)
+}
+
+// NewDirBackupSource returns a BackupSource providing files of the backup
+// found in the specified directory, e.g. a backup written by the BackupSink
+// returned by dragonboat.NewDirBackupSink. The default filesystem is used when
+// fs is nil.
+func NewDirBackupSource(dir string, fs config.IFS) BackupSource {
+	if fs == nil {
+		fs = vfs.DefaultFS
+	}
+	return importer.NewDirSource(dir, fs)
+}
+
+// RestoreNodeHost reconstructs the NodeHost directories specified by
+// nhConfig.NodeHostDir and nhConfig.WALDir from the backup provided by src.
+// Snapshots, Raft states, Raft log entries and bootstrap records of all
+// replicas included in the backup are restored, the NodeHostID of the backed
+// up NodeHost is recorded as well. Once RestoreNodeHost returns, the NodeHost
+// can be started using nhConfig and all restored replicas can be restarted in
+// the same way as they were restarted on the backed up NodeHost.
+//
+// RestoreNodeHost operates offline, the NodeHost directories must not contain
+// any replica, ErrNodeHostNotEmpty is returned otherwise. nhConfig must have
+// the same DeploymentID as the backed up NodeHost, its RaftAddress must also
+// be the same unless NodeHostConfig.DefaultNodeRegistryEnabled is set,
+// ErrBackupMismatch is returned otherwise. ErrInvalidBackup is returned when
+// the manifest of the backup is corrupted or when any file fails its checksum
+// check, the NodeHost directories should be removed before retrying in such
+// case.
+func RestoreNodeHost(nhConfig config.NodeHostConfig,
+	src BackupSource) (err error) {
+	if err := prepareNodeHostConfig(&nhConfig); err != nil {
+		return err
+	}
+	fs := nhConfig.Expert.FS
+	m, err := backup.GetManifest(src)
+	if err != nil {
+		return err
+	}
+	if m.DeploymentID != nhConfig.GetDeploymentID() {
+		plog.Errorf("DeploymentID in NodeHostConfig %d, in backup %d",
+			nhConfig.GetDeploymentID(), m.DeploymentID)
+		return ErrBackupMismatch
+	}
+	if !nhConfig.DefaultNodeRegistryEnabled &&
+		m.RaftAddress != nhConfig.RaftAddress {
+		plog.Errorf("RaftAddress in NodeHostConfig %s, in backup %s",
+			nhConfig.RaftAddress, m.RaftAddress)
+		return ErrBackupMismatch
+	}
+	env, err := server.NewEnv(nhConfig, fs)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, env.Close())
+	}()
+	if _, _, err := env.CreateNodeHostDir(nhConfig.DeploymentID); err != nil {
+		return err
+	}
+	if err := env.LockNodeHostDir(); err != nil {
+		return err
+	}
+	logdb, err := getLogDB(*env, nhConfig)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, logdb.Close())
+	}()
+	if err := env.CheckNodeHostDir(nhConfig,
+		logdb.BinaryFormat(), logdb.Name()); err != nil {
+		return err
+	}
+	nodes, err := logdb.ListNodeInfo()
+	if err != nil {
+		return err
+	}
+	if len(nodes) > 0 {
+		return ErrNodeHostNotEmpty
+	}
+	if len(m.NodeHostID) > 0 {
+		if err := server.WriteNodeHostID(nhConfig.NodeHostDir,
+			m.NodeHostID, fs); err != nil {
+			return err
+		}
+	}
+	getSnapshotDir := func(cid uint64, nid uint64) string {
+		return env.GetSnapshotDir(nhConfig.DeploymentID, cid, nid)
+	}
+	for _, r := range m.Replicas {
+		if err := env.CreateSnapshotDir(nhConfig.DeploymentID,
+			r.ShardID, r.ReplicaID); err != nil {
+			return err
+		}
+		// the same LogDB worker used by the execution engine for the shard
+		workerID := r.ShardID%nhConfig.Expert.Engine.ExecShards + 1
+		if err := backup.Install(logdb,
+			getSnapshotDir, r, src, workerID, fs); err != nil {
+			return err
+		}
+		plog.Infof("%s restored, entries [%d, %d]",
+			dn(r.ShardID, r.ReplicaID), r.FirstIndex, r.LastIndex)
+	}
+	return nil
+}
@@ -0,0 +1,428 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package balancer provides a leader balancer for distributing Raft shard
+leaderships evenly across a fleet of NodeHost instances.
+
+The balancer computes the target leader placement from the ShardInfo lists
+reported by NodeHost instances, it then executes the placement by issuing
+rate limited leader transfer requests. The placement is re-evaluated after
+each failed leader transfer.
+*/
+package balancer
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/logger"
+)
+
+var (
+	plog = logger.GetLogger("balancer")
+)
+
+var (
+	// ErrNoProgress indicates that the balancer failed to make any leader
+	// transfer during a balancing round.
+	ErrNoProgress = errors.New("no leader transfer made")
+	// ErrUnknownHost indicates that a planned move refers to an unknown host.
+	ErrUnknownHost = errors.New("unknown host")
+)
+
+const (
+	defaultMaxMovesPerMinute = 60
+	defaultTransferTimeout   = 5 * time.Second
+)
+
+// ILeaderTransferer is the interface used by the balancer to transfer the
+// leadership of Raft shards. *dragonboat.NodeHost implements this interface.
+type ILeaderTransferer interface {
+	SyncRequestLeaderTransfer(ctx context.Context, shardID uint64,
+		targetReplicaID uint64, opt dragonboat.LeaderTransferOption) error
+}
+
+// Host is the view of a NodeHost instance used by the balancer.
+type Host struct {
+	// RaftAddress is the RaftAddress of the NodeHost, it is used to identify
+	// the host.
+	RaftAddress string
+	// NodeHostID is the NodeHostID of the NodeHost, it is optional unless the
+	// drain state of the host is obtained using WithDrainState.
+	NodeHostID string
+	// Shards is the list of Raft shards managed by the NodeHost, it is usually
+	// the ShardInfoList of the NodeHostInfo returned by the GetNodeHostInfo
+	// method or gathered via the gossip registry.
+	Shards []dragonboat.ShardInfo
+	// Draining indicates that the host is being drained, leaderships are never
+	// moved onto a draining host while leaderships held by a draining host are
+	// moved away.
+	Draining bool
+	// Transferer is used for transferring leaderships held by the host.
+	Transferer ILeaderTransferer
+}
+
+// GetHost returns the Host of the specified NodeHost instance.
+func GetHost(nh *dragonboat.NodeHost, draining bool) Host {
+	opt := dragonboat.NodeHostInfoOption{SkipLogInfo: true}
+	info := nh.GetNodeHostInfo(opt)
+	var shards []dragonboat.ShardInfo
+	if info != nil {
+		shards = info.ShardInfoList
+	}
+	return Host{
+		RaftAddress: nh.RaftAddress(),
+		NodeHostID:  nh.ID(),
+		Shards:      shards,
+		Draining:    draining,
+		Transferer:  nh,
+	}
+}
+
+// WithDrainState returns a func that can be used as the getHosts func of
+// NewBalancer. Hosts returned by the specified getHosts func are marked as
+// draining when they are advertised as draining in the specified registry,
+// i.e. when NodeHost.SetDrainState has been called on them. Draining hosts are
+// never picked as leader transfer targets while their leaderships are moved
+// away at the rate limited by Config.MaxMovesPerMinute.
+func WithDrainState(r dragonboat.INodeHostRegistry,
+	getHosts func() ([]Host, error)) func() ([]Host, error) {
+	return func() ([]Host, error) {
+		hosts, err := getHosts()
+		if err != nil {
+			return nil, err
+		}
+		for idx := range hosts {
+			if hosts[idx].NodeHostID == "" {
+				continue
+			}
+			draining, ok := r.IsNodeHostDraining(hosts[idx].NodeHostID)
+			if ok && draining {
+				hosts[idx].Draining = true
+			}
+		}
+		return hosts, nil
+	}
+}
+
+// Move is a planned leadership transfer.
+type Move struct {
+	// ShardID is the ShardID of the Raft shard.
+	ShardID uint64
+	// From is the ReplicaID of the current leader.
+	From uint64
+	// To is the ReplicaID of the target replica.
+	To uint64
+	// FromHost is the RaftAddress of the host of the current leader.
+	FromHost string
+	// ToHost is the RaftAddress of the host of the target replica.
+	ToHost string
+}
+
+// Config is the balancer configuration.
+type Config struct {
+	// Weight returns the weight of the specified Raft shard. It is optional,
+	// all shards are assigned with the weight of 1 when Weight is not set.
+	Weight func(shardID uint64) uint64
+	// MaxMovesPerMinute is the max number of leader transfers requested per
+	// minute. The default value 60 is used when MaxMovesPerMinute is 0.
+	MaxMovesPerMinute uint64
+	// TransferTimeout is the timeout of each leader transfer. The default
+	// value of 5 seconds is used when TransferTimeout is 0.
+	TransferTimeout time.Duration
+	// DryRun indicates that planned moves are returned without being executed.
+	DryRun bool
+}
+
+func (c *Config) weight(shardID uint64) uint64 {
+	if c.Weight == nil {
+		return 1
+	}
+	return c.Weight(shardID)
+}
+
+// Balancer balances Raft shard leaderships across NodeHost instances.
+type Balancer struct {
+	cfg      Config
+	getHosts func() ([]Host, error)
+}
+
+// NewBalancer creates a new balancer instance. The getHosts func is invoked
+// to get the up to date view of all hosts each time the placement is
+// evaluated.
+func NewBalancer(cfg Config, getHosts func() ([]Host, error)) *Balancer {
+	if cfg.MaxMovesPerMinute == 0 {
+		cfg.MaxMovesPerMinute = defaultMaxMovesPerMinute
+	}
+	if cfg.TransferTimeout == 0 {
+		cfg.TransferTimeout = defaultTransferTimeout
+	}
+	return &Balancer{cfg: cfg, getHosts: getHosts}
+}
+
+// Plan returns the planned moves based on the current view of all hosts.
+func (b *Balancer) Plan() ([]Move, error) {
+	hosts, err := b.getHosts()
+	if err != nil {
+		return nil, err
+	}
+	return plan(hosts, b.cfg.weight), nil
+}
+
+// Run balances leaderships until the planned placement is reached or the
+// context is done. It returns the executed moves, or the planned moves when
+// DryRun is set. The placement is re-evaluated after each failed leader
+// transfer and after all planned moves have been made. ErrNoProgress is
+// returned when no leader transfer can be made in a balancing round.
+func (b *Balancer) Run(ctx context.Context) ([]Move, error) {
+	if b.cfg.DryRun {
+		return b.Plan()
+	}
+	interval := time.Minute / time.Duration(b.cfg.MaxMovesPerMinute)
+	var done []Move
+	var last time.Time
+	for {
+		hosts, err := b.getHosts()
+		if err != nil {
+			return done, err
+		}
+		moves := plan(hosts, b.cfg.weight)
+		if len(moves) == 0 {
+			return done, nil
+		}
+		transferers := make(map[string]ILeaderTransferer, len(hosts))
+		for _, h := range hosts {
+			transferers[h.RaftAddress] = h.Transferer
+		}
+		made := 0
+		for _, m := range moves {
+			if err := wait(ctx, last, interval); err != nil {
+				return done, err
+			}
+			last = time.Now()
+			if err := b.execute(ctx, transferers, m); err != nil {
+				if ctx.Err() != nil {
+					return done, err
+				}
+				plog.Warningf("failed to move shard %d leadership from %s to %s, %v",
+					m.ShardID, m.FromHost, m.ToHost, err)
+				break
+			}
+			done = append(done, m)
+			made++
+		}
+		if made == 0 {
+			return done, ErrNoProgress
+		}
+	}
+}
+
+func (b *Balancer) execute(ctx context.Context,
+	transferers map[string]ILeaderTransferer, m Move) error {
+	t, ok := transferers[m.FromHost]
+	if !ok || t == nil {
+		return ErrUnknownHost
+	}
+	tctx, cancel := context.WithTimeout(ctx, b.cfg.TransferTimeout)
+	defer cancel()
+	opt := dragonboat.LeaderTransferOption{}
+	return t.SyncRequestLeaderTransfer(tctx, m.ShardID, m.To, opt)
+}
+
+func wait(ctx context.Context, last time.Time, interval time.Duration) error {
+	d := interval - time.Since(last)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type shardLeader struct {
+	host      int
+	replicaID uint64
+	term      uint64
+}
+
+type candidate struct {
+	host      int
+	replicaID uint64
+}
+
+type placement struct {
+	hosts      []Host
+	load       []uint64
+	led        []map[uint64]struct{}
+	leaders    map[uint64]shardLeader
+	candidates map[uint64][]candidate
+	weight     func(uint64) uint64
+}
+
+func newPlacement(hosts []Host, weight func(uint64) uint64) *placement {
+	p := &placement{
+		hosts:      hosts,
+		load:       make([]uint64, len(hosts)),
+		led:        make([]map[uint64]struct{}, len(hosts)),
+		leaders:    make(map[uint64]shardLeader),
+		candidates: make(map[uint64][]candidate),
+		weight:     weight,
+	}
+	for idx, h := range hosts {
+		p.led[idx] = make(map[uint64]struct{})
+		for _, si := range h.Shards {
+			if si.Pending || si.IsNonVoting || si.IsWitness {
+				continue
+			}
+			if si.LeaderID == si.ReplicaID && si.LeaderID != 0 {
+				// hosts might be reporting outdated leaderships
+				if l, ok := p.leaders[si.ShardID]; !ok || si.Term > l.term {
+					p.leaders[si.ShardID] = shardLeader{
+						host:      idx,
+						replicaID: si.ReplicaID,
+						term:      si.Term,
+					}
+				}
+			}
+			if !h.Draining {
+				p.candidates[si.ShardID] = append(p.candidates[si.ShardID],
+					candidate{host: idx, replicaID: si.ReplicaID})
+			}
+		}
+	}
+	for shardID, l := range p.leaders {
+		p.led[l.host][shardID] = struct{}{}
+		p.load[l.host] += weight(shardID)
+	}
+	return p
+}
+
+// getMove returns the move that reduces the load of the specified host.
+func (p *placement) getMove(from int) (Move, bool) {
+	shards := make([]uint64, 0, len(p.led[from]))
+	for shardID := range p.led[from] {
+		shards = append(shards, shardID)
+	}
+	// heavier shards first
+	sort.Slice(shards, func(i, j int) bool {
+		wi, wj := p.weight(shards[i]), p.weight(shards[j])
+		if wi != wj {
+			return wi > wj
+		}
+		return shards[i] < shards[j]
+	})
+	for _, shardID := range shards {
+		w := p.weight(shardID)
+		var best *candidate
+		for idx, c := range p.candidates[shardID] {
+			if c.host == from {
+				continue
+			}
+			if !p.hosts[from].Draining && p.load[c.host]+w >= p.load[from] {
+				continue
+			}
+			if best == nil || p.load[c.host] < p.load[best.host] {
+				best = &p.candidates[shardID][idx]
+			}
+		}
+		if best != nil {
+			return Move{
+				ShardID:  shardID,
+				From:     p.leaders[shardID].replicaID,
+				To:       best.replicaID,
+				FromHost: p.hosts[from].RaftAddress,
+				ToHost:   p.hosts[best.host].RaftAddress,
+			}, true
+		}
+	}
+	return Move{}, false
+}
+
+func (p *placement) apply(m Move, from int, to int) {
+	w := p.weight(m.ShardID)
+	p.load[from] -= w
+	p.load[to] += w
+	delete(p.led[from], m.ShardID)
+	p.led[to][m.ShardID] = struct{}{}
+	p.leaders[m.ShardID] = shardLeader{host: to, replicaID: m.To}
+}
+
+// plan computes leader transfers that balance the total weight of shards led
+// by each non-draining host. Each move strictly reduces the load difference
+// between the involved hosts, moves of the same shard are merged so the
+// leadership of each shard is transferred at most once.
+func plan(hosts []Host, weight func(uint64) uint64) []Move {
+	p := newPlacement(hosts, weight)
+	index := make(map[string]int, len(hosts))
+	for idx, h := range hosts {
+		index[h.RaftAddress] = idx
+	}
+	planned := make(map[uint64]*Move)
+	var shards []uint64
+	for {
+		order := make([]int, len(hosts))
+		for idx := range order {
+			order[idx] = idx
+		}
+		// draining hosts first, then the most loaded ones
+		sort.Slice(order, func(i, j int) bool {
+			hi, hj := order[i], order[j]
+			if hosts[hi].Draining != hosts[hj].Draining {
+				return hosts[hi].Draining
+			}
+			if p.load[hi] != p.load[hj] {
+				return p.load[hi] > p.load[hj]
+			}
+			return hosts[hi].RaftAddress < hosts[hj].RaftAddress
+		})
+		found := false
+		for _, from := range order {
+			m, ok := p.getMove(from)
+			if !ok {
+				continue
+			}
+			p.apply(m, from, index[m.ToHost])
+			if pm, ok := planned[m.ShardID]; ok {
+				pm.To = m.To
+				pm.ToHost = m.ToHost
+			} else {
+				planned[m.ShardID] = &m
+				shards = append(shards, m.ShardID)
+			}
+			found = true
+			break
+		}
+		if !found {
+			break
+		}
+	}
+	moves := make([]Move, 0, len(shards))
+	for _, shardID := range shards {
+		// the leadership might be planned to return to where it was
+		if m := planned[shardID]; m.From != m.To {
+			moves = append(moves, *m)
+		}
+	}
+	return moves
+}
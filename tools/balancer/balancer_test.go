@@ -0,0 +1,324 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4"
+)
+
+type simShard struct {
+	hosts  map[uint64]int
+	leader uint64
+	term   uint64
+}
+
+// simFleet simulates a fleet of NodeHosts each managing many shards.
+type simFleet struct {
+	t        *testing.T
+	mu       sync.Mutex
+	shards   map[uint64]*simShard
+	hosts    int
+	draining map[int]struct{}
+	calls    int
+	failEach int
+}
+
+func newSimFleet(t *testing.T, hosts int, shards int) *simFleet {
+	f := &simFleet{
+		t:        t,
+		shards:   make(map[uint64]*simShard),
+		hosts:    hosts,
+		draining: make(map[int]struct{}),
+	}
+	r := rand.New(rand.NewSource(1))
+	for shardID := uint64(1); shardID <= uint64(shards); shardID++ {
+		s := &simShard{hosts: make(map[uint64]int), term: 1}
+		placed := r.Perm(hosts)[:3]
+		for idx, h := range placed {
+			s.hosts[uint64(idx+1)] = h
+		}
+		// skewed, the leader is always the replica on the first few hosts
+		s.leader = 1
+		for replicaID, h := range s.hosts {
+			if h < s.hosts[s.leader] {
+				s.leader = replicaID
+			}
+		}
+		f.shards[shardID] = s
+	}
+	return f
+}
+
+func (f *simFleet) address(h int) string {
+	return fmt.Sprintf("nh%d:1", h)
+}
+
+func (f *simFleet) getHosts() ([]Host, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hosts := make([]Host, f.hosts)
+	for h := range hosts {
+		_, draining := f.draining[h]
+		hosts[h] = Host{
+			RaftAddress: f.address(h),
+			Draining:    draining,
+			Transferer:  &simTransferer{host: h, f: f},
+		}
+	}
+	for shardID, s := range f.shards {
+		for replicaID, h := range s.hosts {
+			hosts[h].Shards = append(hosts[h].Shards, dragonboat.ShardInfo{
+				ShardID:   shardID,
+				ReplicaID: replicaID,
+				LeaderID:  s.leader,
+				Term:      s.term,
+			})
+		}
+	}
+	return hosts, nil
+}
+
+func (f *simFleet) transfer(host int, shardID uint64, target uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	s := f.shards[shardID]
+	if s.hosts[s.leader] != host {
+		f.t.Errorf("transfer requested on shard %d from non-leader host", shardID)
+	}
+	h, ok := s.hosts[target]
+	if !ok {
+		f.t.Fatalf("unknown target %d", target)
+	}
+	if _, ok := f.draining[h]; ok {
+		f.t.Errorf("leadership moved onto draining host %d", h)
+	}
+	if f.failEach > 0 && f.calls%f.failEach == 0 {
+		return dragonboat.ErrTimeout
+	}
+	s.leader = target
+	s.term++
+	return nil
+}
+
+func (f *simFleet) loads(weight func(uint64) uint64) []uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	loads := make([]uint64, f.hosts)
+	for shardID, s := range f.shards {
+		loads[s.hosts[s.leader]] += weight(shardID)
+	}
+	return loads
+}
+
+type simTransferer struct {
+	host int
+	f    *simFleet
+}
+
+func (t *simTransferer) SyncRequestLeaderTransfer(ctx context.Context,
+	shardID uint64, target uint64, opt dragonboat.LeaderTransferOption) error {
+	return t.f.transfer(t.host, shardID, target)
+}
+
+func getLoadRange(loads []uint64, excluded map[int]struct{}) (uint64, uint64) {
+	min, max := uint64(0), uint64(0)
+	first := true
+	for h, l := range loads {
+		if _, ok := excluded[h]; ok {
+			continue
+		}
+		if first || l < min {
+			min = l
+		}
+		if first || l > max {
+			max = l
+		}
+		first = false
+	}
+	return min, max
+}
+
+func unitWeight(uint64) uint64 { return 1 }
+
+func runSimBalancer(t *testing.T, f *simFleet, cfg Config) []Move {
+	cfg.MaxMovesPerMinute = uint64(time.Minute / time.Microsecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	moves, err := NewBalancer(cfg, f.getHosts).Run(ctx)
+	if err != nil {
+		t.Fatalf("failed to run balancer, %v", err)
+	}
+	return moves
+}
+
+func TestSkewedLeadershipConverges(t *testing.T) {
+	f := newSimFleet(t, 10, 1000)
+	if min, max := getLoadRange(f.loads(unitWeight), nil); max-min < 100 {
+		t.Fatalf("placement not skewed, min %d, max %d", min, max)
+	}
+	// some transfers fail, the placement is re-evaluated
+	f.failEach = 7
+	moves := runSimBalancer(t, f, Config{})
+	if len(moves) == 0 {
+		t.Fatalf("no move made")
+	}
+	if min, max := getLoadRange(f.loads(unitWeight), nil); max-min > 1 {
+		t.Errorf("not balanced, min %d, max %d", min, max)
+	}
+	plan, err := NewBalancer(Config{}, f.getHosts).Plan()
+	if err != nil {
+		t.Fatalf("failed to plan, %v", err)
+	}
+	if len(plan) != 0 {
+		t.Errorf("unexpected moves planned for balanced placement, %d", len(plan))
+	}
+}
+
+func TestLeadershipIsMovedAwayFromDrainingHosts(t *testing.T) {
+	f := newSimFleet(t, 10, 1000)
+	f.draining[0] = struct{}{}
+	f.draining[5] = struct{}{}
+	runSimBalancer(t, f, Config{})
+	loads := f.loads(unitWeight)
+	if loads[0] != 0 || loads[5] != 0 {
+		t.Errorf("draining hosts still lead shards, %d, %d", loads[0], loads[5])
+	}
+	if min, max := getLoadRange(loads, f.draining); max-min > 1 {
+		t.Errorf("not balanced, min %d, max %d", min, max)
+	}
+}
+
+// drainRegistry reports the drain state of hosts as advertised via gossip.
+type drainRegistry struct {
+	dragonboat.INodeHostRegistry
+	draining map[string]bool
+}
+
+func (r *drainRegistry) IsNodeHostDraining(nhID string) (bool, bool) {
+	draining, ok := r.draining[nhID]
+	return draining, ok
+}
+
+func TestLeadershipIsMovedAwayFromHostsAdvertisedAsDraining(t *testing.T) {
+	f := newSimFleet(t, 10, 1000)
+	r := &drainRegistry{draining: make(map[string]bool)}
+	for h := 0; h < f.hosts; h++ {
+		r.draining[fmt.Sprintf("nh%d", h)] = h == 0
+	}
+	getHosts := func() ([]Host, error) {
+		hosts, err := f.getHosts()
+		if err != nil {
+			return nil, err
+		}
+		for h := range hosts {
+			hosts[h].NodeHostID = fmt.Sprintf("nh%d", h)
+		}
+		return hosts, nil
+	}
+	if loads := f.loads(unitWeight); loads[0] == 0 {
+		t.Fatalf("host 0 doesn't lead any shard")
+	}
+	// host 0 is only known as draining via the registry
+	cfg := Config{MaxMovesPerMinute: uint64(time.Minute / time.Microsecond)}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	b := NewBalancer(cfg, WithDrainState(r, getHosts))
+	if _, err := b.Run(ctx); err != nil {
+		t.Fatalf("failed to run balancer, %v", err)
+	}
+	if loads := f.loads(unitWeight); loads[0] != 0 {
+		t.Errorf("draining host still leads %d shards", loads[0])
+	}
+}
+
+func TestWeightedLeadershipConverges(t *testing.T) {
+	f := newSimFleet(t, 10, 1000)
+	weight := func(shardID uint64) uint64 { return shardID%5 + 1 }
+	runSimBalancer(t, f, Config{Weight: weight})
+	if min, max := getLoadRange(f.loads(weight), nil); max-min > 5 {
+		t.Errorf("not balanced, min %d, max %d", min, max)
+	}
+}
+
+func TestDryRunDoesNotMoveLeadership(t *testing.T) {
+	f := newSimFleet(t, 10, 100)
+	before := f.loads(unitWeight)
+	moves, err := NewBalancer(Config{DryRun: true}, f.getHosts).Run(context.Background())
+	if err != nil {
+		t.Fatalf("dry run failed, %v", err)
+	}
+	if len(moves) == 0 {
+		t.Fatalf("no move planned")
+	}
+	if f.calls != 0 {
+		t.Errorf("leader transfer requested in dry run mode")
+	}
+	// executing the plan on the simulated fleet balances the leaderships
+	for _, m := range moves {
+		var host int
+		if _, err := fmt.Sscanf(m.FromHost, "nh%d:1", &host); err != nil {
+			t.Fatalf("unexpected host %s", m.FromHost)
+		}
+		if err := f.transfer(host, m.ShardID, m.To); err != nil {
+			t.Fatalf("transfer failed %v", err)
+		}
+	}
+	bmin, bmax := getLoadRange(before, nil)
+	if min, max := getLoadRange(f.loads(unitWeight), nil); max-min > 2 || max-min >= bmax-bmin {
+		t.Errorf("not balanced, min %d, max %d", min, max)
+	}
+}
+
+func TestMovesAreRateLimited(t *testing.T) {
+	f := newSimFleet(t, 4, 20)
+	f.shards = map[uint64]*simShard{
+		1: {hosts: map[uint64]int{1: 0, 2: 1, 3: 2}, leader: 1, term: 1},
+		2: {hosts: map[uint64]int{1: 0, 2: 1, 3: 3}, leader: 1, term: 1},
+		3: {hosts: map[uint64]int{1: 0, 2: 2, 3: 3}, leader: 1, term: 1},
+	}
+	cfg := Config{MaxMovesPerMinute: 600}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	moves, err := NewBalancer(cfg, f.getHosts).Run(ctx)
+	if err != nil {
+		t.Fatalf("failed to run balancer, %v", err)
+	}
+	if len(moves) != 2 {
+		t.Fatalf("unexpected moves %v", moves)
+	}
+	// the first move is made immediately
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("moves not rate limited, %v", elapsed)
+	}
+}
+
+func TestNoProgressIsReported(t *testing.T) {
+	f := newSimFleet(t, 10, 100)
+	f.failEach = 1
+	cfg := Config{MaxMovesPerMinute: uint64(time.Minute / time.Microsecond)}
+	_, err := NewBalancer(cfg, f.getHosts).Run(context.Background())
+	if err != ErrNoProgress {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package balancer
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lni/dragonboat/v4"
+)
+
+const (
+	defaultDeadThreshold       = 5 * time.Minute
+	defaultMaxReseedsPerMinute = 6
+	defaultReseedTimeout       = 10 * time.Second
+	defaultCheckInterval       = 10 * time.Second
+)
+
+// IWitnessReseeder is the interface used by the WitnessReseeder to replace
+// witnesses. *dragonboat.NodeHost implements this interface.
+type IWitnessReseeder interface {
+	SyncReseedWitness(ctx context.Context, shardID uint64,
+		oldReplicaID uint64, newReplicaID uint64,
+		newTarget string, configChangeIndex uint64) error
+}
+
+// Reseed is a suggested replacement of a witness hosted on a dead NodeHost.
+type Reseed struct {
+	// ShardID is the ShardID of the Raft shard.
+	ShardID uint64
+	// OldReplicaID is the ReplicaID of the witness to be replaced.
+	OldReplicaID uint64
+	// OldNodeHostID is the NodeHostID of the dead NodeHost running the witness
+	// to be replaced.
+	OldNodeHostID string
+	// NewReplicaID is the ReplicaID of the new witness.
+	NewReplicaID uint64
+	// NewNodeHostID is the NodeHostID of the NodeHost that should run the new
+	// witness.
+	NewNodeHostID string
+	// NewTarget is the target of the new witness.
+	NewTarget string
+	// ConfigChangeIndex is the ConfigChangeIndex of the shard placement the
+	// reseed is based on.
+	ConfigChangeIndex uint64
+}
+
+// ReseedConfig is the WitnessReseeder configuration.
+type ReseedConfig struct {
+	// DeadThreshold is how long the NodeHost running a witness must be
+	// observed as dead before the witness is reseeded. The default value of 5
+	// minutes is used when DeadThreshold is 0.
+	DeadThreshold time.Duration
+	// Constraints specifies how NodeHosts running new witnesses are picked,
+	// see SuggestWitnessHost for details.
+	Constraints WitnessConstraints
+	// Target returns the target of the new witness on the specified NodeHost.
+	// It is optional, the NodeHostID is used as the target when Target is not
+	// set, which requires the DefaultNodeRegistryEnabled field of the
+	// NodeHostConfig to be set.
+	Target func(nhID string) string
+	// NewReplicaID returns the ReplicaID of the new witness of the specified
+	// shard. It is optional, the largest ReplicaID in the shard placement plus
+	// one is used when NewReplicaID is not set. Reseed requests using a
+	// previously removed ReplicaID are rejected.
+	NewReplicaID func(p dragonboat.ShardPlacement) uint64
+	// MaxReseedsPerMinute is the max number of reseed requests made per minute
+	// by Run. The default value 6 is used when MaxReseedsPerMinute is 0.
+	MaxReseedsPerMinute uint64
+	// ReseedTimeout is the timeout of each reseed request. The default value
+	// of 10 seconds is used when ReseedTimeout is 0.
+	ReseedTimeout time.Duration
+	// CheckInterval is the interval between two checks made by Run. The
+	// default value of 10 seconds is used when CheckInterval is 0.
+	CheckInterval time.Duration
+	// OnReseed is invoked after each successful reseed request made by Run,
+	// e.g. to start the new witness on NewNodeHostID. It is optional.
+	OnReseed func(r Reseed)
+}
+
+func (c *ReseedConfig) target(nhID string) string {
+	if c.Target == nil {
+		return nhID
+	}
+	return c.Target(nhID)
+}
+
+func (c *ReseedConfig) newReplicaID(p dragonboat.ShardPlacement) uint64 {
+	if c.NewReplicaID != nil {
+		return c.NewReplicaID(p)
+	}
+	max := uint64(0)
+	for _, rp := range p.Replicas {
+		if rp.ReplicaID > max {
+			max = rp.ReplicaID
+		}
+	}
+	return max + 1
+}
+
+type reseedKey struct {
+	shardID   uint64
+	replicaID uint64
+}
+
+// WitnessReseeder replaces witnesses hosted on NodeHosts observed as dead for
+// longer than the configured threshold. The liveness of NodeHosts is taken
+// from shard placements in the specified registry, which is expected to be
+// the gossip based registry returned by NodeHost.GetNodeHostRegistry. As dead
+// NodeHosts are eventually forgotten by the registry, NodeHosts observed as
+// dead are considered as dead until they are reported as alive again, the
+// registry thus needs to be checked at an interval shorter than 10 minutes.
+type WitnessReseeder struct {
+	cfg      ReseedConfig
+	registry dragonboat.INodeHostRegistry
+	reseeder IWitnessReseeder
+	clock    func() time.Time
+	mu       sync.Mutex
+	// deadSince is the time when each NodeHost was first observed as dead
+	deadSince map[string]time.Time
+	// requested contains witnesses with reseed requests already completed
+	requested map[reseedKey]struct{}
+}
+
+// NewWitnessReseeder creates a new WitnessReseeder instance. Reseed requests
+// are made through the specified IWitnessReseeder, which is usually a
+// NodeHost running a replica of all involved shards.
+func NewWitnessReseeder(cfg ReseedConfig, r dragonboat.INodeHostRegistry,
+	reseeder IWitnessReseeder) *WitnessReseeder {
+	if cfg.DeadThreshold == 0 {
+		cfg.DeadThreshold = defaultDeadThreshold
+	}
+	if cfg.MaxReseedsPerMinute == 0 {
+		cfg.MaxReseedsPerMinute = defaultMaxReseedsPerMinute
+	}
+	if cfg.ReseedTimeout == 0 {
+		cfg.ReseedTimeout = defaultReseedTimeout
+	}
+	if cfg.CheckInterval == 0 {
+		cfg.CheckInterval = defaultCheckInterval
+	}
+	return &WitnessReseeder{
+		cfg:       cfg,
+		registry:  r,
+		reseeder:  reseeder,
+		clock:     time.Now,
+		deadSince: make(map[string]time.Time),
+		requested: make(map[reseedKey]struct{}),
+	}
+}
+
+// Suggest returns the suggested reseeds of witnesses hosted on NodeHosts that
+// have been observed as dead for longer than the configured threshold, they
+// are ordered by their shard IDs. Witnesses for which no new NodeHost can be
+// picked are skipped.
+func (w *WitnessReseeder) Suggest() []Reseed {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.suggest()
+}
+
+func (w *WitnessReseeder) suggest() []Reseed {
+	now := w.clock()
+	shards := w.registry.ListShards(dragonboat.ShardFilter{})
+	w.observe(shards, now)
+	var result []Reseed
+	for _, p := range shards {
+		for _, rp := range p.Replicas {
+			if rp.Role != dragonboat.Witness {
+				continue
+			}
+			if _, ok := w.requested[reseedKey{p.ShardID, rp.ReplicaID}]; ok {
+				continue
+			}
+			since, ok := w.deadSince[rp.NodeHostID]
+			if !ok || now.Sub(since) < w.cfg.DeadThreshold {
+				continue
+			}
+			nhID, err := w.suggestHost(p, rp.ReplicaID)
+			if err != nil {
+				plog.Warningf("no host for reseeding witness %d of shard %d, %v",
+					rp.ReplicaID, p.ShardID, err)
+				continue
+			}
+			result = append(result, Reseed{
+				ShardID:           p.ShardID,
+				OldReplicaID:      rp.ReplicaID,
+				OldNodeHostID:     rp.NodeHostID,
+				NewReplicaID:      w.cfg.newReplicaID(p),
+				NewNodeHostID:     nhID,
+				NewTarget:         w.cfg.target(nhID),
+				ConfigChangeIndex: p.ConfigChangeIndex,
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ShardID < result[j].ShardID
+	})
+	return result
+}
+
+// observe updates the dead NodeHosts based on the liveness reported in the
+// specified shard placements.
+func (w *WitnessReseeder) observe(shards []dragonboat.ShardPlacement,
+	now time.Time) {
+	seen := make(map[string]struct{})
+	replicas := make(map[reseedKey]struct{})
+	for _, p := range shards {
+		for _, rp := range p.Replicas {
+			replicas[reseedKey{p.ShardID, rp.ReplicaID}] = struct{}{}
+			seen[rp.NodeHostID] = struct{}{}
+			switch rp.Liveness {
+			case dragonboat.NodeHostDead:
+				if _, ok := w.deadSince[rp.NodeHostID]; !ok {
+					w.deadSince[rp.NodeHostID] = now
+				}
+			case dragonboat.NodeHostUnknown:
+				// dead NodeHosts are forgotten by the registry after a while
+			default:
+				delete(w.deadSince, rp.NodeHostID)
+			}
+		}
+	}
+	for nhID := range w.deadSince {
+		if _, ok := seen[nhID]; !ok {
+			delete(w.deadSince, nhID)
+		}
+	}
+	// replaced witnesses eventually disappear from shard placements
+	for key := range w.requested {
+		if _, ok := replicas[key]; !ok {
+			delete(w.requested, key)
+		}
+	}
+}
+
+// suggestHost picks the NodeHost for the new witness. Zones and hosts of the
+// replaced witness can be reused, dead NodeHosts are never picked.
+func (w *WitnessReseeder) suggestHost(p dragonboat.ShardPlacement,
+	replaced uint64) (string, error) {
+	c := w.cfg.Constraints
+	c.Candidates = nil
+	for _, nhID := range w.cfg.Constraints.Candidates {
+		if _, ok := w.deadSince[nhID]; !ok {
+			c.Candidates = append(c.Candidates, nhID)
+		}
+	}
+	return suggestWitnessHost(p, replaced, w.registry, c)
+}
+
+// Run checks witnesses at the configured interval and executes the suggested
+// reseeds until the context is done, reseed requests are rate limited by
+// MaxReseedsPerMinute. Failed reseed requests are retried in later checks.
+// The context error is returned once the context is done.
+func (w *WitnessReseeder) Run(ctx context.Context) error {
+	interval := time.Minute / time.Duration(w.cfg.MaxReseedsPerMinute)
+	var last time.Time
+	ticker := time.NewTicker(w.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		w.mu.Lock()
+		reseeds := w.suggest()
+		w.mu.Unlock()
+		for _, r := range reseeds {
+			if err := wait(ctx, last, interval); err != nil {
+				return err
+			}
+			last = time.Now()
+			if err := w.execute(ctx, r); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				plog.Warningf("failed to reseed witness %d of shard %d, %v",
+					r.OldReplicaID, r.ShardID, err)
+				continue
+			}
+			plog.Infof("witness %d of shard %d reseeded as %d on %s",
+				r.OldReplicaID, r.ShardID, r.NewReplicaID, r.NewNodeHostID)
+			if w.cfg.OnReseed != nil {
+				w.cfg.OnReseed(r)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (w *WitnessReseeder) execute(ctx context.Context, r Reseed) error {
+	tctx, cancel := context.WithTimeout(ctx, w.cfg.ReseedTimeout)
+	defer cancel()
+	if err := w.reseeder.SyncReseedWitness(tctx, r.ShardID, r.OldReplicaID,
+		r.NewReplicaID, r.NewTarget, r.ConfigChangeIndex); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.requested[reseedKey{r.ShardID, r.OldReplicaID}] = struct{}{}
+	w.mu.Unlock()
+	return nil
+}
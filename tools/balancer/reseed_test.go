@@ -0,0 +1,421 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/config"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func (r *placementRegistry) setLiveness(nhID string,
+	liveness dragonboat.NodeHostLiveness) {
+	for shardID, p := range r.shards {
+		for idx := range p.Replicas {
+			if p.Replicas[idx].NodeHostID == nhID {
+				p.Replicas[idx].Liveness = liveness
+			}
+		}
+		r.shards[shardID] = p
+	}
+}
+
+type testReseeder struct {
+	mu      sync.Mutex
+	reseeds []Reseed
+	fail    bool
+}
+
+func (t *testReseeder) SyncReseedWitness(ctx context.Context,
+	shardID uint64, oldReplicaID uint64, newReplicaID uint64,
+	newTarget string, configChangeIndex uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.fail {
+		return errors.New("failed to reseed")
+	}
+	t.reseeds = append(t.reseeds, Reseed{
+		ShardID:           shardID,
+		OldReplicaID:      oldReplicaID,
+		NewReplicaID:      newReplicaID,
+		NewTarget:         newTarget,
+		ConfigChangeIndex: configChangeIndex,
+	})
+	return nil
+}
+
+func (t *testReseeder) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.reseeds)
+}
+
+func TestWitnessOnDeadHostIsSuggestedAfterThreshold(t *testing.T) {
+	r := newPlacementRegistry()
+	r.addShard(1, []string{"nh1", "nh2"}, []string{"nh3"})
+	r.setLiveness("nh3", dragonboat.NodeHostDead)
+	cfg := ReseedConfig{
+		DeadThreshold: time.Minute,
+		Constraints: WitnessConstraints{
+			Candidates: []string{"nh1", "nh2", "nh3", "nh4", "nh5"},
+		},
+	}
+	w := NewWitnessReseeder(cfg, r, &testReseeder{})
+	now := time.Now()
+	w.clock = func() time.Time { return now }
+	if reseeds := w.Suggest(); len(reseeds) != 0 {
+		t.Fatalf("unexpected reseeds %+v", reseeds)
+	}
+	now = now.Add(2 * time.Minute)
+	reseeds := w.Suggest()
+	// nh4 is in the zone of the dead nh3
+	expected := Reseed{
+		ShardID:       1,
+		OldReplicaID:  3,
+		OldNodeHostID: "nh3",
+		NewReplicaID:  4,
+		NewNodeHostID: "nh4",
+		NewTarget:     "nh4",
+	}
+	if len(reseeds) != 1 || reseeds[0] != expected {
+		t.Errorf("unexpected reseeds %+v", reseeds)
+	}
+}
+
+func TestForgottenDeadHostIsStillConsideredAsDead(t *testing.T) {
+	r := newPlacementRegistry()
+	r.addShard(1, []string{"nh1", "nh2"}, []string{"nh3"})
+	cfg := ReseedConfig{
+		DeadThreshold: time.Minute,
+		Constraints:   WitnessConstraints{Candidates: []string{"nh4"}},
+	}
+	w := NewWitnessReseeder(cfg, r, &testReseeder{})
+	now := time.Now()
+	w.clock = func() time.Time { return now }
+	// never observed as dead
+	now = now.Add(2 * time.Minute)
+	if reseeds := w.Suggest(); len(reseeds) != 0 {
+		t.Fatalf("unexpected reseeds %+v", reseeds)
+	}
+	r.setLiveness("nh3", dragonboat.NodeHostDead)
+	w.Suggest()
+	r.setLiveness("nh3", dragonboat.NodeHostUnknown)
+	now = now.Add(2 * time.Minute)
+	if reseeds := w.Suggest(); len(reseeds) != 1 {
+		t.Fatalf("unexpected reseeds %+v", reseeds)
+	}
+	// recovered
+	r.setLiveness("nh3", dragonboat.NodeHostAlive)
+	w.Suggest()
+	r.setLiveness("nh3", dragonboat.NodeHostDead)
+	now = now.Add(time.Second)
+	if reseeds := w.Suggest(); len(reseeds) != 0 {
+		t.Errorf("unexpected reseeds %+v", reseeds)
+	}
+}
+
+func TestReseedsAreRateLimited(t *testing.T) {
+	r := newPlacementRegistry()
+	r.addShard(1, []string{"nh1", "nh2"}, []string{"nh3"})
+	r.addShard(2, []string{"nh1", "nh5"}, []string{"nh3"})
+	r.addShard(3, []string{"nh2", "nh5"}, []string{"nh3"})
+	r.setLiveness("nh3", dragonboat.NodeHostDead)
+	reseeder := &testReseeder{}
+	var mu sync.Mutex
+	var reseeded []Reseed
+	cfg := ReseedConfig{
+		DeadThreshold:       time.Millisecond,
+		Constraints:         WitnessConstraints{Candidates: []string{"nh4"}},
+		MaxReseedsPerMinute: 600,
+		CheckInterval:       10 * time.Millisecond,
+		OnReseed: func(r Reseed) {
+			mu.Lock()
+			defer mu.Unlock()
+			reseeded = append(reseeded, r)
+		},
+	}
+	w := NewWitnessReseeder(cfg, r, reseeder)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Run(ctx)
+	}()
+	for reseeder.count() < 3 && ctx.Err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	// the first reseed is made immediately
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("reseeds not rate limited, %v", elapsed)
+	}
+	// completed reseeds are not requested again
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if reseeder.count() != 3 || len(reseeded) != 3 {
+		t.Fatalf("unexpected reseeds %+v", reseeded)
+	}
+	for idx, r := range reseeded {
+		if r.ShardID != uint64(idx+1) || r.OldReplicaID != 3 ||
+			r.NewReplicaID != 4 || r.NewNodeHostID != "nh4" {
+			t.Errorf("unexpected reseed %+v", r)
+		}
+	}
+}
+
+func TestFailedReseedIsRetried(t *testing.T) {
+	r := newPlacementRegistry()
+	r.addShard(1, []string{"nh1", "nh2"}, []string{"nh3"})
+	r.setLiveness("nh3", dragonboat.NodeHostDead)
+	reseeder := &testReseeder{fail: true}
+	cfg := ReseedConfig{
+		DeadThreshold:       time.Millisecond,
+		Constraints:         WitnessConstraints{Candidates: []string{"nh4"}},
+		MaxReseedsPerMinute: uint64(time.Minute / time.Millisecond),
+		CheckInterval:       10 * time.Millisecond,
+	}
+	w := NewWitnessReseeder(cfg, r, reseeder)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Run(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	reseeder.mu.Lock()
+	reseeder.fail = false
+	reseeder.mu.Unlock()
+	for reseeder.count() == 0 && ctx.Err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	if reseeder.count() != 1 {
+		t.Errorf("unexpected reseed count %d", reseeder.count())
+	}
+}
+
+type witnessTestSM struct{}
+
+func (s *witnessTestSM) Update(e sm.Entry) (sm.Result, error) {
+	return sm.Result{Value: e.Index}, nil
+}
+
+func (s *witnessTestSM) Lookup(query interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func (s *witnessTestSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	return nil
+}
+
+func (s *witnessTestSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	return nil
+}
+
+func (s *witnessTestSM) Close() error { return nil }
+
+func newWitnessTestSM(uint64, uint64) sm.IStateMachine {
+	return &witnessTestSM{}
+}
+
+var reseedTestNodeHostIDs = []string{
+	"123e4567-e89b-12d3-a456-426614175001",
+	"123e4567-e89b-12d3-a456-426614175002",
+	"123e4567-e89b-12d3-a456-426614175003",
+	"123e4567-e89b-12d3-a456-426614175004",
+}
+
+// startGossipMesh starts NodeHost instances using the gossip registry, hosts
+// are placed in zones a, b, c and c.
+func startGossipMesh(t *testing.T) []*dragonboat.NodeHost {
+	t.Helper()
+	zones := []string{"a", "b", "c", "c"}
+	var nhs []*dragonboat.NodeHost
+	for i, nhID := range reseedTestNodeHostIDs {
+		nhc := config.NodeHostConfig{
+			NodeHostDir:                t.TempDir(),
+			RTTMillisecond:             5,
+			RaftAddress:                fmt.Sprintf("127.0.0.1:%d", 28101+i),
+			NodeHostID:                 nhID,
+			DefaultNodeRegistryEnabled: true,
+			Expert: config.ExpertConfig{
+				LogDB:                   config.GetTinyMemLogDBConfig(),
+				TestGossipProbeInterval: 50 * time.Millisecond,
+			},
+			Gossip: config.GossipConfig{
+				BindAddress:        fmt.Sprintf("127.0.0.1:%d", 28201+i),
+				AdvertiseAddress:   fmt.Sprintf("127.0.0.1:%d", 28201+i),
+				Seed:               []string{"127.0.0.1:28201", "127.0.0.1:28202"},
+				SuspectGracePeriod: 200 * time.Millisecond,
+				Tags:               map[string]string{"zone": zones[i]},
+			},
+		}
+		nh, err := dragonboat.NewNodeHost(nhc)
+		if err != nil {
+			for _, nh := range nhs {
+				nh.Close()
+			}
+			t.Fatalf("failed to create NodeHost %v", err)
+		}
+		nhs = append(nhs, nh)
+	}
+	return nhs
+}
+
+func startWitnessTestReplica(t *testing.T,
+	nh *dragonboat.NodeHost, members map[uint64]string,
+	replicaID uint64, witness bool) {
+	t.Helper()
+	rc := config.Config{
+		ShardID:      1,
+		ReplicaID:    replicaID,
+		ElectionRTT:  10,
+		HeartbeatRTT: 1,
+		IsWitness:    witness,
+	}
+	if err := nh.StartReplica(members,
+		len(members) == 0, newWitnessTestSM, rc); err != nil {
+		t.Fatalf("failed to start replica %v", err)
+	}
+}
+
+func TestWitnessOnKilledHostIsReseeded(t *testing.T) {
+	nhs := startGossipMesh(t)
+	closed := make(map[int]bool)
+	defer func() {
+		for idx, nh := range nhs {
+			if !closed[idx] {
+				nh.Close()
+			}
+		}
+	}()
+	ids := reseedTestNodeHostIDs
+	members := map[uint64]string{1: ids[0], 2: ids[1]}
+	startWitnessTestReplica(t, nhs[0], members, 1, false)
+	startWitnessTestReplica(t, nhs[1], members, 2, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	retry := func(f func() error) {
+		t.Helper()
+		for {
+			err := f()
+			if err == nil {
+				return
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("failed to complete the request, %v", err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	retry(func() error {
+		cctx, ccancel := context.WithTimeout(ctx, 2*time.Second)
+		defer ccancel()
+		return nhs[0].SyncRequestAddWitness(cctx, 1, 3, ids[2], 0)
+	})
+	startWitnessTestReplica(t, nhs[2], nil, 3, true)
+	r, ok := nhs[0].GetNodeHostRegistry()
+	if !ok {
+		t.Fatalf("failed to get registry")
+	}
+	retry(func() error {
+		p, ok := r.GetShardPlacement(1)
+		if ok && len(p.Replicas) == 3 &&
+			p.Replicas[2].Liveness == dragonboat.NodeHostAlive {
+			return nil
+		}
+		return errors.Newf("unexpected placement %+v", p)
+	})
+	nhs[2].Close()
+	closed[2] = true
+	reseeded := make(chan Reseed, 1)
+	cfg := ReseedConfig{
+		DeadThreshold:       100 * time.Millisecond,
+		Constraints:         WitnessConstraints{Candidates: ids},
+		MaxReseedsPerMinute: 600,
+		CheckInterval:       50 * time.Millisecond,
+		OnReseed:            func(r Reseed) { reseeded <- r },
+	}
+	w := NewWitnessReseeder(cfg, r, nhs[0])
+	retry(func() error {
+		if reseeds := w.Suggest(); len(reseeds) != 1 {
+			return errors.Newf("unexpected reseeds %+v", reseeds)
+		}
+		return nil
+	})
+	reseeds := w.Suggest()
+	if reseeds[0].OldReplicaID != 3 || reseeds[0].OldNodeHostID != ids[2] ||
+		reseeds[0].NewReplicaID != 4 || reseeds[0].NewNodeHostID != ids[3] ||
+		reseeds[0].NewTarget != ids[3] {
+		t.Fatalf("unexpected reseed %+v", reseeds[0])
+	}
+	rctx, rcancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Run(rctx)
+	}()
+	select {
+	case <-reseeded:
+	case <-ctx.Done():
+		t.Fatalf("witness not reseeded")
+	}
+	rcancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error %v", err)
+	}
+	startWitnessTestReplica(t, nhs[3], nil, 4, true)
+	var m *dragonboat.Membership
+	retry(func() error {
+		cctx, ccancel := context.WithTimeout(ctx, 2*time.Second)
+		defer ccancel()
+		var err error
+		m, err = nhs[0].SyncGetShardMembership(cctx, 1)
+		return err
+	})
+	if len(m.Witnesses) != 1 || m.Witnesses[4] != ids[3] {
+		t.Errorf("unexpected witnesses %v", m.Witnesses)
+	}
+	if _, ok := m.Removed[3]; !ok {
+		t.Errorf("replaced witness not removed")
+	}
+	// the shard remains available with the new witness after losing one of
+	// its regular replicas
+	nhs[1].Close()
+	closed[1] = true
+	retry(func() error {
+		cctx, ccancel := context.WithTimeout(ctx, 2*time.Second)
+		defer ccancel()
+		_, err := nhs[0].SyncPropose(cctx,
+			nhs[0].GetNoOPSession(1), []byte("test-data"))
+		return err
+	})
+}
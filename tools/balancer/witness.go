@@ -0,0 +1,137 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package balancer
+
+import (
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+)
+
+var (
+	// ErrUnknownShard indicates that the shard is not known to the registry.
+	ErrUnknownShard = errors.New("unknown shard")
+	// ErrNoWitnessHost indicates that none of the candidate hosts can run the
+	// witness without being collocated with other replicas of the shard.
+	ErrNoWitnessHost = errors.New("no suitable witness host")
+)
+
+const (
+	defaultZoneTag = "zone"
+)
+
+// WitnessConstraints specifies how the witness host is picked by
+// SuggestWitnessHost.
+type WitnessConstraints struct {
+	// Candidates are NodeHostID values of NodeHost instances that can run the
+	// witness.
+	Candidates []string
+	// ZoneTag is the key of the NodeHost tag describing the zone of the
+	// NodeHost, see config.GossipConfig.Tags. The default value "zone" is used
+	// when ZoneTag is empty.
+	ZoneTag string
+}
+
+func (c *WitnessConstraints) zoneTag() string {
+	if len(c.ZoneTag) == 0 {
+		return defaultZoneTag
+	}
+	return c.ZoneTag
+}
+
+// SuggestWitnessHost returns the NodeHostID of the candidate host that should
+// run a new witness of the specified shard. The picked host is in a zone not
+// used by any replica of the shard, it is not draining and it runs the fewest
+// witnesses among such candidates, ties are broken by picking the smallest
+// NodeHostID. Candidates with unknown zones are never picked. Replicas,
+// witnesses, zones and drain states are all taken from the specified
+// registry, which is expected to be the gossip based registry returned by
+// NodeHost.GetNodeHostRegistry. ErrNoWitnessHost is returned when no candidate
+// can be picked.
+func SuggestWitnessHost(shardID uint64,
+	r dragonboat.INodeHostRegistry, c WitnessConstraints) (string, error) {
+	p, ok := r.GetShardPlacement(shardID)
+	if !ok {
+		return "", ErrUnknownShard
+	}
+	return suggestWitnessHost(p, 0, r, c)
+}
+
+// suggestWitnessHost picks the witness host for the specified shard placement,
+// the excluded replica is ignored when it is not 0.
+func suggestWitnessHost(p dragonboat.ShardPlacement, excluded uint64,
+	r dragonboat.INodeHostRegistry, c WitnessConstraints) (string, error) {
+	tag := c.zoneTag()
+	hosts := make(map[string]struct{})
+	zones := make(map[string]struct{})
+	for _, rp := range p.Replicas {
+		if excluded != 0 && rp.ReplicaID == excluded {
+			continue
+		}
+		hosts[rp.NodeHostID] = struct{}{}
+		if zone, ok := getZone(r, rp.NodeHostID, tag); ok {
+			zones[zone] = struct{}{}
+		}
+	}
+	selected := ""
+	selectedWitnesses := 0
+	for _, nhID := range c.Candidates {
+		if _, ok := hosts[nhID]; ok {
+			continue
+		}
+		zone, ok := getZone(r, nhID, tag)
+		if !ok {
+			continue
+		}
+		if _, ok := zones[zone]; ok {
+			continue
+		}
+		if draining, ok := r.IsNodeHostDraining(nhID); ok && draining {
+			continue
+		}
+		witnesses := countWitnesses(r, nhID)
+		if len(selected) == 0 || witnesses < selectedWitnesses ||
+			(witnesses == selectedWitnesses && nhID < selected) {
+			selected = nhID
+			selectedWitnesses = witnesses
+		}
+	}
+	if len(selected) == 0 {
+		return "", ErrNoWitnessHost
+	}
+	return selected, nil
+}
+
+func getZone(r dragonboat.INodeHostRegistry,
+	nhID string, tag string) (string, bool) {
+	tags, ok := r.GetNodeHostTags(nhID)
+	if !ok {
+		return "", false
+	}
+	zone, ok := tags[tag]
+	return zone, ok && len(zone) > 0
+}
+
+func countWitnesses(r dragonboat.INodeHostRegistry, nhID string) int {
+	count := 0
+	for _, p := range r.ListShards(dragonboat.ShardFilter{NodeHostID: nhID}) {
+		for _, rp := range p.Replicas {
+			if rp.NodeHostID == nhID && rp.Role == dragonboat.Witness {
+				count++
+			}
+		}
+	}
+	return count
+}
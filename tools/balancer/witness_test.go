@@ -0,0 +1,156 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package balancer
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+)
+
+// placementRegistry is a registry with known shard placements and tags.
+type placementRegistry struct {
+	dragonboat.INodeHostRegistry
+	shards   map[uint64]dragonboat.ShardPlacement
+	tags     map[string]map[string]string
+	draining map[string]bool
+}
+
+func (r *placementRegistry) GetShardPlacement(
+	shardID uint64) (dragonboat.ShardPlacement, bool) {
+	p, ok := r.shards[shardID]
+	return p, ok
+}
+
+func (r *placementRegistry) ListShards(
+	f dragonboat.ShardFilter) []dragonboat.ShardPlacement {
+	var result []dragonboat.ShardPlacement
+	for _, p := range r.shards {
+		for _, rp := range p.Replicas {
+			if len(f.NodeHostID) == 0 || rp.NodeHostID == f.NodeHostID {
+				result = append(result, p)
+				break
+			}
+		}
+	}
+	return result
+}
+
+func (r *placementRegistry) GetNodeHostTags(
+	nhID string) (map[string]string, bool) {
+	tags, ok := r.tags[nhID]
+	return tags, ok
+}
+
+func (r *placementRegistry) IsNodeHostDraining(nhID string) (bool, bool) {
+	draining, ok := r.draining[nhID]
+	return draining, ok
+}
+
+func (r *placementRegistry) addShard(shardID uint64,
+	voters []string, witnesses []string) {
+	p := dragonboat.ShardPlacement{ShardID: shardID}
+	for _, nhID := range voters {
+		p.Replicas = append(p.Replicas, dragonboat.ReplicaPlacement{
+			ReplicaID:  uint64(len(p.Replicas) + 1),
+			NodeHostID: nhID,
+			Role:       dragonboat.Voter,
+		})
+	}
+	for _, nhID := range witnesses {
+		p.Replicas = append(p.Replicas, dragonboat.ReplicaPlacement{
+			ReplicaID:  uint64(len(p.Replicas) + 1),
+			NodeHostID: nhID,
+			Role:       dragonboat.Witness,
+		})
+	}
+	r.shards[shardID] = p
+}
+
+func newPlacementRegistry() *placementRegistry {
+	r := &placementRegistry{
+		shards:   make(map[uint64]dragonboat.ShardPlacement),
+		tags:     make(map[string]map[string]string),
+		draining: make(map[string]bool),
+	}
+	zones := map[string]string{
+		"nh1": "a", "nh2": "b", "nh3": "c", "nh4": "c", "nh5": "d", "nh6": "d",
+	}
+	for nhID, zone := range zones {
+		r.tags[nhID] = map[string]string{"zone": zone, "rack": nhID}
+	}
+	return r
+}
+
+func TestWitnessHostIsInDifferentZone(t *testing.T) {
+	r := newPlacementRegistry()
+	r.addShard(1, []string{"nh1", "nh2"}, nil)
+	// nh5 already runs witnesses of two other shards
+	r.addShard(2, []string{"nh1", "nh3"}, []string{"nh5"})
+	r.addShard(3, []string{"nh2", "nh3"}, []string{"nh5"})
+	c := WitnessConstraints{
+		Candidates: []string{"nh1", "nh2", "nh3", "nh4", "nh5", "nh6"},
+	}
+	nhID, err := SuggestWitnessHost(1, r, c)
+	if err != nil {
+		t.Fatalf("failed to suggest witness host %v", err)
+	}
+	if nhID != "nh3" {
+		t.Errorf("suggested %s, want nh3", nhID)
+	}
+	// nh4 is in the same zone as the replica on nh3
+	r.addShard(4, []string{"nh1", "nh2", "nh3"}, nil)
+	if nhID, err = SuggestWitnessHost(4, r, c); err != nil {
+		t.Fatalf("failed to suggest witness host %v", err)
+	}
+	if nhID != "nh6" {
+		t.Errorf("suggested %s, want nh6", nhID)
+	}
+	r.draining["nh6"] = true
+	if nhID, err = SuggestWitnessHost(4, r, c); err != nil {
+		t.Fatalf("failed to suggest witness host %v", err)
+	}
+	if nhID != "nh5" {
+		t.Errorf("suggested %s, want nh5", nhID)
+	}
+}
+
+func TestWitnessHostCanBeSelectedByCustomZoneTag(t *testing.T) {
+	r := newPlacementRegistry()
+	r.addShard(1, []string{"nh3", "nh5"}, nil)
+	c := WitnessConstraints{
+		Candidates: []string{"nh4", "nh6"},
+	}
+	if _, err := SuggestWitnessHost(1, r, c); !errors.Is(err, ErrNoWitnessHost) {
+		t.Errorf("unexpected error %v", err)
+	}
+	c.ZoneTag = "rack"
+	nhID, err := SuggestWitnessHost(1, r, c)
+	if err != nil {
+		t.Fatalf("failed to suggest witness host %v", err)
+	}
+	if nhID != "nh4" {
+		t.Errorf("suggested %s, want nh4", nhID)
+	}
+	c.ZoneTag = "unknown"
+	if _, err := SuggestWitnessHost(1, r, c); !errors.Is(err, ErrNoWitnessHost) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := SuggestWitnessHost(2, r, c); !errors.Is(err, ErrUnknownShard) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,467 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package bench provides a reproducible workload driver for comparing the
+performance of different dragonboat builds.
+
+Run starts the requested number of in-process NodeHost instances connected by
+the in-memory transport or by real TCP connections, creates the requested
+number of shards on them and drives proposals and linearizable reads against
+an in-memory key value state machine. Requests made by each client are
+generated from a fixed random seed, two runs with the same Config make the
+same sequence of requests. The Result reports the throughput, latency
+percentiles, heap allocations and the number of bytes saved into the LogDB,
+it can be emitted as JSON for scripted comparisons.
+*/
+package bench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/logger"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+)
+
+var (
+	plog = logger.GetLogger("bench")
+)
+
+var (
+	// ErrInvalidConfig indicates that the Config is invalid.
+	ErrInvalidConfig = errors.New("invalid bench config")
+)
+
+// Transport is the transport used by NodeHost instances.
+type Transport uint8
+
+const (
+	// MemTransport connects NodeHost instances using the in-memory transport.
+	MemTransport Transport = iota
+	// TCPTransport connects NodeHost instances using real TCP connections.
+	TCPTransport
+)
+
+func (t Transport) String() string {
+	switch t {
+	case MemTransport:
+		return "mem"
+	case TCPTransport:
+		return "tcp"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	defaultNodeHosts      = 3
+	defaultReplicas       = 3
+	defaultRTTMillisecond = 2
+	defaultBasePort       = 26100
+	defaultTimeout        = 5 * time.Second
+	defaultSeed           = 1
+)
+
+// Config is the configuration of a benchmark run.
+type Config struct {
+	// Name is the name of the run included in the Result.
+	Name string
+	// NodeHosts is the number of in-process NodeHost instances.
+	NodeHosts int
+	// Shards is the number of shards.
+	Shards int
+	// Replicas is the number of replicas of each shard, it can not be larger
+	// than NodeHosts. Replicas of shards are placed on NodeHost instances in a
+	// round robin way.
+	Replicas int
+	// Clients is the number of concurrent clients of each shard.
+	Clients int
+	// Operations is the number of requests made by each client.
+	Operations int
+	// Workload describes the requests made by clients.
+	Workload Workload
+	// Seed is the seed used for generating requests, the seed of each client is
+	// derived from it.
+	Seed int64
+	// Transport is the transport used by NodeHost instances.
+	Transport Transport
+	// BasePort is the port used by the first NodeHost instance when Transport
+	// is TCPTransport.
+	BasePort int
+	// RTTMillisecond is the RTTMillisecond of NodeHost instances.
+	RTTMillisecond uint64
+	// SnapshotEntries is the SnapshotEntries of replicas, the default value 0
+	// means that snapshots are never created.
+	SnapshotEntries uint64
+	// CompactionOverhead is the CompactionOverhead of replicas.
+	CompactionOverhead uint64
+	// Timeout is the timeout of each request.
+	Timeout time.Duration
+	// Dir is the directory used by NodeHost instances. A temporary directory
+	// removed after the run is used when it is empty.
+	Dir string
+	// FS is the filesystem used by NodeHost instances, the default OS
+	// filesystem is used when it is nil.
+	FS config.IFS
+	// LogDB is the LogDB configuration of NodeHost instances, the small memory
+	// configuration is used when it is not set.
+	LogDB config.LogDBConfig
+}
+
+func (c Config) withDefaults() Config {
+	if c.NodeHosts == 0 {
+		c.NodeHosts = defaultNodeHosts
+	}
+	if c.Shards == 0 {
+		c.Shards = 1
+	}
+	if c.Replicas == 0 {
+		c.Replicas = defaultReplicas
+		if c.Replicas > c.NodeHosts {
+			c.Replicas = c.NodeHosts
+		}
+	}
+	if c.Clients == 0 {
+		c.Clients = 1
+	}
+	if c.Seed == 0 {
+		c.Seed = defaultSeed
+	}
+	if c.BasePort == 0 {
+		c.BasePort = defaultBasePort
+	}
+	if c.RTTMillisecond == 0 {
+		c.RTTMillisecond = defaultRTTMillisecond
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultTimeout
+	}
+	if c.LogDB.IsEmpty() {
+		c.LogDB = config.GetSmallMemLogDBConfig()
+	}
+	c.Workload = c.Workload.withDefaults()
+	return c
+}
+
+func (c Config) validate() error {
+	if c.NodeHosts < 0 || c.Shards < 0 || c.Clients < 0 || c.Operations < 0 {
+		return errors.Wrap(ErrInvalidConfig, "negative count")
+	}
+	if c.Replicas > c.NodeHosts {
+		return errors.Wrapf(ErrInvalidConfig,
+			"%d replicas on %d NodeHosts", c.Replicas, c.NodeHosts)
+	}
+	if c.Workload.ReadRatio < 0 || c.Workload.ReadRatio > 1 {
+		return errors.Wrapf(ErrInvalidConfig,
+			"invalid read ratio %f", c.Workload.ReadRatio)
+	}
+	if c.Transport > TCPTransport {
+		return errors.Wrap(ErrInvalidConfig, "unknown transport")
+	}
+	return nil
+}
+
+// clientSeed returns the seed of the specified client of the shard.
+func (c Config) clientSeed(shardID uint64, client int) int64 {
+	return c.Seed + int64(shardID-1)*int64(c.Clients) + int64(client)
+}
+
+// Run runs the benchmark specified by the Config and returns its Result.
+func Run(ctx context.Context, cfg Config) (*Result, error) {
+	cfg = cfg.withDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if len(cfg.Dir) == 0 && cfg.FS == nil {
+		dir, err := os.MkdirTemp("", "dragonboat-bench")
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := os.RemoveAll(dir); err != nil {
+				plog.Errorf("failed to remove %s, %v", dir, err)
+			}
+		}()
+		cfg.Dir = dir
+	} else if len(cfg.Dir) == 0 {
+		cfg.Dir = "dragonboat-bench"
+	}
+	f := newCountingLogDBFactory(nil)
+	nhs, err := startNodeHosts(cfg, f)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, nh := range nhs {
+			nh.Close()
+		}
+	}()
+	leaders, err := startShards(ctx, cfg, nhs)
+	if err != nil {
+		return nil, err
+	}
+	return drive(ctx, cfg, nhs, leaders, f)
+}
+
+func startNodeHosts(cfg Config,
+	f *countingLogDBFactory) ([]*dragonboat.NodeHost, error) {
+	var network *memtransport.Network
+	if cfg.Transport == MemTransport {
+		network = memtransport.NewNetwork()
+	}
+	nhs := make([]*dragonboat.NodeHost, 0, cfg.NodeHosts)
+	for i := 1; i <= cfg.NodeHosts; i++ {
+		dir := filepath.Join(cfg.Dir, fmt.Sprintf("nh%d", i))
+		nhc := config.NodeHostConfig{
+			NodeHostDir:    dir,
+			WALDir:         dir,
+			RTTMillisecond: cfg.RTTMillisecond,
+			RaftAddress:    getAddress(cfg, i),
+			Expert:         config.GetDefaultExpertConfig(),
+		}
+		nhc.Expert.LogDB = cfg.LogDB
+		nhc.Expert.LogDBFactory = f
+		nhc.Expert.FS = cfg.FS
+		if network != nil {
+			nhc.Expert.TransportFactory = network
+		}
+		nh, err := dragonboat.NewNodeHost(nhc)
+		if err != nil {
+			for _, v := range nhs {
+				v.Close()
+			}
+			return nil, err
+		}
+		nhs = append(nhs, nh)
+	}
+	return nhs, nil
+}
+
+func getAddress(cfg Config, i int) string {
+	if cfg.Transport == MemTransport {
+		return memtransport.Address(i)
+	}
+	return fmt.Sprintf("localhost:%d", cfg.BasePort+i-1)
+}
+
+// startShards starts all shards and returns the index of the NodeHost hosting
+// the leader of each shard.
+func startShards(ctx context.Context,
+	cfg Config, nhs []*dragonboat.NodeHost) ([]int, error) {
+	for shardID := uint64(1); shardID <= uint64(cfg.Shards); shardID++ {
+		hosts := getShardHosts(cfg, shardID)
+		members := make(map[uint64]dragonboat.Target)
+		for idx, h := range hosts {
+			members[uint64(idx+1)] = getAddress(cfg, h+1)
+		}
+		for idx, h := range hosts {
+			rc := config.Config{
+				ShardID:            shardID,
+				ReplicaID:          uint64(idx + 1),
+				ElectionRTT:        10,
+				HeartbeatRTT:       1,
+				CheckQuorum:        true,
+				PreVote:            true,
+				SnapshotEntries:    cfg.SnapshotEntries,
+				CompactionOverhead: cfg.CompactionOverhead,
+			}
+			if err := nhs[h].StartReplica(members,
+				false, newKVStateMachine, rc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	leaders := make([]int, cfg.Shards)
+	for shardID := uint64(1); shardID <= uint64(cfg.Shards); shardID++ {
+		h, err := waitForLeader(ctx, cfg, nhs, shardID)
+		if err != nil {
+			return nil, err
+		}
+		leaders[shardID-1] = h
+	}
+	return leaders, nil
+}
+
+// getShardHosts returns the indexes of NodeHost instances hosting replicas of
+// the specified shard.
+func getShardHosts(cfg Config, shardID uint64) []int {
+	hosts := make([]int, 0, cfg.Replicas)
+	for i := 0; i < cfg.Replicas; i++ {
+		hosts = append(hosts, (int(shardID-1)+i)%cfg.NodeHosts)
+	}
+	return hosts
+}
+
+func waitForLeader(ctx context.Context,
+	cfg Config, nhs []*dragonboat.NodeHost, shardID uint64) (int, error) {
+	hosts := getShardHosts(cfg, shardID)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		leaderID, _, ok, err := nhs[hosts[0]].GetLeaderID(shardID)
+		if err != nil {
+			return 0, err
+		}
+		if ok && leaderID > 0 && leaderID <= uint64(len(hosts)) {
+			return hosts[leaderID-1], nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// clientResult is the result of a client.
+type clientResult struct {
+	writes latencies
+	reads  latencies
+	errors uint64
+	err    error
+}
+
+func drive(ctx context.Context, cfg Config, nhs []*dragonboat.NodeHost,
+	leaders []int, f *countingLogDBFactory) (*Result, error) {
+	results := make([]*clientResult, 0, cfg.Shards*cfg.Clients)
+	for shardID := uint64(1); shardID <= uint64(cfg.Shards); shardID++ {
+		for c := 0; c < cfg.Clients; c++ {
+			results = append(results, &clientResult{
+				writes: make(latencies, 0, cfg.Operations),
+				reads:  make(latencies, 0, cfg.Operations),
+			})
+		}
+	}
+	written := f.bytesWritten()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for shardID := uint64(1); shardID <= uint64(cfg.Shards); shardID++ {
+		nh := nhs[leaders[shardID-1]]
+		for c := 0; c < cfg.Clients; c++ {
+			wg.Add(1)
+			r := results[int(shardID-1)*cfg.Clients+c]
+			go func(shardID uint64, c int) {
+				defer wg.Done()
+				runClient(ctx, cfg, nh, shardID, c, r)
+			}(shardID, c)
+		}
+	}
+	wg.Wait()
+	duration := time.Since(start)
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	writes := make([]latencies, 0, len(results))
+	reads := make([]latencies, 0, len(results))
+	errs := uint64(0)
+	for _, r := range results {
+		if r.err != nil {
+			return nil, r.err
+		}
+		writes = append(writes, r.writes)
+		reads = append(reads, r.reads)
+		errs += r.errors
+	}
+	result := &Result{
+		Name:              cfg.Name,
+		Seed:              cfg.Seed,
+		Transport:         cfg.Transport.String(),
+		NodeHosts:         cfg.NodeHosts,
+		Shards:            cfg.Shards,
+		Clients:           cfg.Clients,
+		Errors:            errs,
+		Duration:          duration,
+		Writes:            summarize(writes),
+		Reads:             summarize(reads),
+		LogDBBytesWritten: f.bytesWritten() - written,
+	}
+	result.Operations = result.Writes.Count + result.Reads.Count
+	if result.Operations > 0 {
+		ops := float64(result.Operations)
+		result.Throughput = ops / duration.Seconds()
+		result.AllocsPerOp = float64(after.Mallocs-before.Mallocs) / ops
+		result.BytesPerOp = float64(after.TotalAlloc-before.TotalAlloc) / ops
+	}
+	return result, nil
+}
+
+// runClient makes the requests of the specified client of the shard. Failed
+// requests are counted and skipped, the client stops when the context is
+// done or the client session can not be registered or unregistered.
+func runClient(ctx context.Context, cfg Config, nh *dragonboat.NodeHost,
+	shardID uint64, c int, r *clientResult) {
+	g := newGenerator(cfg.Workload, cfg.clientSeed(shardID, c))
+	cs, err := getSession(ctx, cfg, nh, shardID)
+	if err != nil {
+		r.err = err
+		return
+	}
+	var cmd []byte
+	for i := 0; i < cfg.Operations; i++ {
+		if ctx.Err() != nil {
+			r.err = ctx.Err()
+			return
+		}
+		o := g.nextOp()
+		rctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+		start := time.Now()
+		if o.read {
+			_, err = nh.SyncRead(rctx, shardID, o.key)
+		} else {
+			cmd = encodeCommand(cmd, o.key, o.value)
+			_, err = nh.SyncPropose(rctx, cs, cmd)
+		}
+		cancel()
+		latency := time.Since(start)
+		if err != nil {
+			r.errors++
+			continue
+		}
+		if o.read {
+			r.reads = append(r.reads, latency)
+		} else {
+			r.writes = append(r.writes, latency)
+			if !cs.IsNoOPSession() {
+				cs.ProposalCompleted()
+			}
+		}
+	}
+	if !cs.IsNoOPSession() {
+		rctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+		r.err = nh.SyncCloseSession(rctx, cs)
+	}
+}
+
+func getSession(ctx context.Context, cfg Config,
+	nh *dragonboat.NodeHost, shardID uint64) (*client.Session, error) {
+	if !cfg.Workload.UseSessions {
+		return nh.GetNoOPSession(shardID), nil
+	}
+	rctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	return nh.SyncGetSession(rctx, shardID)
+}
@@ -0,0 +1,362 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+var jsonOutput = flag.String("bench.json", "",
+	"file to append the JSON results of benchmarks to")
+
+func getTestConfig(t testing.TB) Config {
+	return Config{
+		Dir:       t.TempDir(),
+		FS:        vfs.GetTestFS(),
+		NodeHosts: 3,
+		Seed:      100,
+	}
+}
+
+func TestGeneratorIsDeterministic(t *testing.T) {
+	w := Workload{
+		KeyDistribution:   ZipfianKeys,
+		ValueDistribution: UniformValues,
+		MinValueSize:      8,
+		ValueSize:         64,
+		ReadRatio:         0.5,
+	}
+	record := func(seed int64) []op {
+		g := newGenerator(w, seed)
+		var ops []op
+		for i := 0; i < 1000; i++ {
+			o := g.nextOp()
+			ops = append(ops, op{
+				key:   append([]byte(nil), o.key...),
+				value: append([]byte(nil), o.value...),
+				read:  o.read,
+			})
+		}
+		return ops
+	}
+	if !reflect.DeepEqual(record(1), record(1)) {
+		t.Errorf("different requests generated from the same seed")
+	}
+	if reflect.DeepEqual(record(1), record(2)) {
+		t.Errorf("same requests generated from different seeds")
+	}
+}
+
+func TestGeneratorFollowsWorkload(t *testing.T) {
+	const count = 10000
+	tests := []struct {
+		w Workload
+	}{
+		{Workload{Keys: 100, ReadRatio: 0.3}},
+		{Workload{Keys: 100, KeyDistribution: ZipfianKeys}},
+		{Workload{Keys: 100, KeyDistribution: SequentialKeys, ReadRatio: 1}},
+		{Workload{ValueDistribution: UniformValues, MinValueSize: 10, ValueSize: 20}},
+	}
+	for idx, tt := range tests {
+		g := newGenerator(tt.w, 1)
+		w := tt.w.withDefaults()
+		reads := 0
+		keys := make(map[string]int)
+		for i := 0; i < count; i++ {
+			o := g.nextOp()
+			keys[string(o.key)]++
+			if o.read {
+				reads++
+				continue
+			}
+			sz := len(o.value)
+			if w.ValueDistribution == FixedValues && sz != w.ValueSize {
+				t.Errorf("%d, unexpected value size %d", idx, sz)
+			}
+			if sz < w.MinValueSize || sz > w.ValueSize {
+				t.Errorf("%d, value size %d out of range", idx, sz)
+			}
+		}
+		ratio := float64(reads) / count
+		if ratio < w.ReadRatio-0.02 || ratio > w.ReadRatio+0.02 {
+			t.Errorf("%d, read ratio %f, want %f", idx, ratio, w.ReadRatio)
+		}
+		if uint64(len(keys)) > w.Keys {
+			t.Errorf("%d, %d keys accessed, want <= %d", idx, len(keys), w.Keys)
+		}
+		switch w.KeyDistribution {
+		case SequentialKeys:
+			for k, v := range keys {
+				if v != count/int(w.Keys) {
+					t.Errorf("%d, key %x accessed %d times", idx, k, v)
+				}
+			}
+		case ZipfianKeys:
+			max := 0
+			for _, v := range keys {
+				if v > max {
+					max = v
+				}
+			}
+			if max < count/10 {
+				t.Errorf("%d, no hot key, max %d", idx, max)
+			}
+		}
+	}
+}
+
+func TestStateMachineCanBeRecoveredFromSnapshot(t *testing.T) {
+	s := newKVStateMachine(1, 1)
+	var cmd []byte
+	for i := 0; i < 10; i++ {
+		key := []byte{byte(i)}
+		cmd = encodeCommand(cmd, key, bytes.Repeat(key, i))
+		if _, err := s.Update(sm.Entry{Cmd: cmd}); err != nil {
+			t.Fatalf("update failed %v", err)
+		}
+	}
+	if _, err := s.Update(sm.Entry{Cmd: []byte{10}}); !errors.Is(err, errInvalidCommand) {
+		t.Errorf("invalid command not rejected, %v", err)
+	}
+	var buf bytes.Buffer
+	if err := s.SaveSnapshot(&buf, nil, nil); err != nil {
+		t.Fatalf("save snapshot failed %v", err)
+	}
+	recovered := newKVStateMachine(1, 1)
+	if err := recovered.RecoverFromSnapshot(&buf, nil, nil); err != nil {
+		t.Fatalf("recover from snapshot failed %v", err)
+	}
+	if !reflect.DeepEqual(s.(*kvStateMachine).data,
+		recovered.(*kvStateMachine).data) {
+		t.Errorf("state not recovered")
+	}
+	v, err := recovered.Lookup([]byte{3})
+	if err != nil {
+		t.Fatalf("lookup failed %v", err)
+	}
+	if !bytes.Equal(v.([]byte), []byte{3, 3, 3}) {
+		t.Errorf("unexpected value %v", v)
+	}
+}
+
+func TestLatencySummary(t *testing.T) {
+	all := []latencies{{}, {}}
+	for i := 1; i <= 1000; i++ {
+		all[i%2] = append(all[i%2], time.Duration(i))
+	}
+	s := summarize(all)
+	expected := LatencySummary{
+		Count: 1000,
+		Mean:  500,
+		P50:   500,
+		P90:   900,
+		P99:   990,
+		P999:  999,
+		Max:   1000,
+	}
+	if s != expected {
+		t.Errorf("summary %+v, want %+v", s, expected)
+	}
+	if s := summarize(nil); s != (LatencySummary{}) {
+		t.Errorf("unexpected empty summary %+v", s)
+	}
+}
+
+func TestResultCanBeWrittenAsJSON(t *testing.T) {
+	r := Result{
+		Name:       "test",
+		Operations: 100,
+		Duration:   time.Second,
+		Writes:     LatencySummary{Count: 100, P99: time.Millisecond},
+	}
+	var buf bytes.Buffer
+	if err := r.WriteJSON(&buf); err != nil {
+		t.Fatalf("failed to write %v", err)
+	}
+	if err := r.WriteJSON(&buf); err != nil {
+		t.Fatalf("failed to write %v", err)
+	}
+	d := json.NewDecoder(&buf)
+	for i := 0; i < 2; i++ {
+		var decoded Result
+		if err := d.Decode(&decoded); err != nil {
+			t.Fatalf("failed to decode %v", err)
+		}
+		if decoded != r {
+			t.Errorf("decoded %+v, want %+v", decoded, r)
+		}
+	}
+}
+
+func TestInvalidConfigIsRejected(t *testing.T) {
+	tests := []Config{
+		{NodeHosts: 1, Replicas: 3},
+		{Clients: -1},
+		{Workload: Workload{ReadRatio: 1.5}},
+		{Transport: TCPTransport + 1},
+	}
+	for idx, cfg := range tests {
+		if _, err := Run(context.Background(), cfg); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%d, invalid config not rejected, %v", idx, err)
+		}
+	}
+}
+
+func TestRunOverMemTransport(t *testing.T) {
+	cfg := getTestConfig(t)
+	cfg.Shards = 2
+	cfg.Clients = 2
+	cfg.Operations = 20
+	cfg.Workload = Workload{ReadRatio: 0.5, UseSessions: true}
+	r, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("run failed %v", err)
+	}
+	if r.Errors != 0 {
+		t.Errorf("%d requests failed", r.Errors)
+	}
+	reads := uint64(0)
+	for shardID := uint64(1); shardID <= 2; shardID++ {
+		for c := 0; c < cfg.Clients; c++ {
+			g := newGenerator(cfg.Workload, cfg.withDefaults().clientSeed(shardID, c))
+			for i := 0; i < cfg.Operations; i++ {
+				if g.nextOp().read {
+					reads++
+				}
+			}
+		}
+	}
+	if r.Operations != 80 || r.Reads.Count != reads ||
+		r.Writes.Count != 80-reads {
+		t.Errorf("unexpected result %+v, %d reads expected", r, reads)
+	}
+	if r.Throughput <= 0 || r.Writes.P50 <= 0 || r.Reads.Max < r.Reads.P99 {
+		t.Errorf("unexpected result %+v", r)
+	}
+	if r.LogDBBytesWritten == 0 || r.AllocsPerOp == 0 {
+		t.Errorf("unexpected result %+v", r)
+	}
+	if r.Transport != "mem" || r.Shards != 2 || r.Seed != 100 {
+		t.Errorf("unexpected result %+v", r)
+	}
+}
+
+// benchResults are the results of the last run of each benchmark, they are
+// written to the file specified by -bench.json once all benchmarks completed.
+var benchResults = struct {
+	names   []string
+	results map[string]*Result
+}{results: make(map[string]*Result)}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	code := m.Run()
+	if len(*jsonOutput) > 0 && len(benchResults.names) > 0 {
+		if err := writeBenchResults(*jsonOutput); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write results, %v\n", err)
+			code = 1
+		}
+	}
+	os.Exit(code)
+}
+
+func writeBenchResults(fn string) error {
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	for _, name := range benchResults.names {
+		if err := benchResults.results[name].WriteJSON(f); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func runBenchmark(b *testing.B, cfg Config) {
+	b.StopTimer()
+	cfg.Name = b.Name()
+	cfg.Operations = b.N
+	r, err := Run(context.Background(), cfg)
+	if err != nil {
+		b.Fatalf("run failed %v", err)
+	}
+	if r.Operations == 0 {
+		b.Fatalf("no completed request")
+	}
+	ops := float64(r.Operations)
+	b.ReportMetric(float64(r.Duration.Nanoseconds())/ops, "ns/op")
+	b.ReportMetric(r.Throughput, "ops/s")
+	b.ReportMetric(float64(r.Writes.P99.Microseconds()), "write-p99-us")
+	b.ReportMetric(r.AllocsPerOp, "allocs/op")
+	b.ReportMetric(float64(r.LogDBBytesWritten)/ops, "logdb-B/op")
+	if _, ok := benchResults.results[r.Name]; !ok {
+		benchResults.names = append(benchResults.names, r.Name)
+	}
+	benchResults.results[r.Name] = r
+}
+
+func BenchmarkWrites(b *testing.B) {
+	cfg := getTestConfig(b)
+	cfg.Clients = 16
+	runBenchmark(b, cfg)
+}
+
+func BenchmarkMixedReadWrite(b *testing.B) {
+	cfg := getTestConfig(b)
+	cfg.Clients = 16
+	cfg.Workload = Workload{KeyDistribution: ZipfianKeys, ReadRatio: 0.8}
+	runBenchmark(b, cfg)
+}
+
+func BenchmarkSessionWrites(b *testing.B) {
+	cfg := getTestConfig(b)
+	cfg.Clients = 16
+	cfg.Workload = Workload{UseSessions: true}
+	runBenchmark(b, cfg)
+}
+
+func BenchmarkMultiShardWrites(b *testing.B) {
+	cfg := getTestConfig(b)
+	cfg.Shards = 16
+	cfg.Clients = 4
+	cfg.Workload = Workload{
+		ValueDistribution: UniformValues,
+		MinValueSize:      16,
+		ValueSize:         1024,
+	}
+	runBenchmark(b, cfg)
+}
+
+func BenchmarkTCPWrites(b *testing.B) {
+	cfg := getTestConfig(b)
+	cfg.Transport = TCPTransport
+	cfg.Clients = 16
+	runBenchmark(b, cfg)
+}
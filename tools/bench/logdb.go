@@ -0,0 +1,83 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"sync/atomic"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/logdb"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// countingLogDBFactory creates LogDB instances counting the number of bytes
+// saved into them.
+type countingLogDBFactory struct {
+	f       config.LogDBFactory
+	written uint64
+}
+
+var _ config.LogDBFactory = (*countingLogDBFactory)(nil)
+
+func newCountingLogDBFactory(f config.LogDBFactory) *countingLogDBFactory {
+	if f == nil {
+		f = logdb.NewDefaultFactory()
+	}
+	return &countingLogDBFactory{f: f}
+}
+
+func (f *countingLogDBFactory) Create(cfg config.NodeHostConfig,
+	cb config.LogDBCallback,
+	dirs []string, lldirs []string) (raftio.ILogDB, error) {
+	db, err := f.f.Create(cfg, cb, dirs, lldirs)
+	if err != nil {
+		return nil, err
+	}
+	return &countingLogDB{ILogDB: db, written: &f.written}, nil
+}
+
+func (f *countingLogDBFactory) Name() string {
+	return f.f.Name()
+}
+
+func (f *countingLogDBFactory) bytesWritten() uint64 {
+	return atomic.LoadUint64(&f.written)
+}
+
+// countingLogDB is a raftio.ILogDB counting the size of Raft log entries and
+// states saved by SaveRaftState.
+type countingLogDB struct {
+	raftio.ILogDB
+	written *uint64
+}
+
+func (db *countingLogDB) SaveRaftState(updates []pb.Update,
+	shardID uint64) error {
+	if err := db.ILogDB.SaveRaftState(updates, shardID); err != nil {
+		return err
+	}
+	sz := 0
+	for i := range updates {
+		for j := range updates[i].EntriesToSave {
+			sz += updates[i].EntriesToSave[j].Size()
+		}
+		if !pb.IsEmptyState(updates[i].State) {
+			sz += updates[i].State.Size()
+		}
+	}
+	atomic.AddUint64(db.written, uint64(sz))
+	return nil
+}
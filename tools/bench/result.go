@@ -0,0 +1,114 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// LatencySummary summarizes the latencies of a type of requests.
+type LatencySummary struct {
+	Count uint64        `json:"count"`
+	Mean  time.Duration `json:"mean_ns"`
+	P50   time.Duration `json:"p50_ns"`
+	P90   time.Duration `json:"p90_ns"`
+	P99   time.Duration `json:"p99_ns"`
+	P999  time.Duration `json:"p999_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+// Result is the result of a benchmark run.
+type Result struct {
+	// Name is the name of the run as specified by Config.Name.
+	Name      string `json:"name"`
+	Seed      int64  `json:"seed"`
+	Transport string `json:"transport"`
+	NodeHosts int    `json:"nodehosts"`
+	Shards    int    `json:"shards"`
+	Clients   int    `json:"clients"`
+	// Operations is the number of completed requests.
+	Operations uint64 `json:"operations"`
+	// Errors is the number of failed requests, they are not included in
+	// Operations or the latency summaries.
+	Errors   uint64        `json:"errors"`
+	Duration time.Duration `json:"duration_ns"`
+	// Throughput is the number of completed requests per second.
+	Throughput float64        `json:"ops_per_second"`
+	Writes     LatencySummary `json:"writes"`
+	Reads      LatencySummary `json:"reads"`
+	// AllocsPerOp is the number of heap allocations made by the process per
+	// completed request, including allocations made by the driver and all
+	// NodeHost instances.
+	AllocsPerOp float64 `json:"allocs_per_op"`
+	// BytesPerOp is the number of heap allocated bytes per completed request.
+	BytesPerOp float64 `json:"bytes_per_op"`
+	// LogDBBytesWritten is the total size of Raft log entries and states saved
+	// into the LogDB by all NodeHost instances.
+	LogDBBytesWritten uint64 `json:"logdb_bytes_written"`
+}
+
+// WriteJSON writes the result to w as a single line of JSON, results of
+// multiple runs can be written to the same file for later comparisons.
+func (r *Result) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(r)
+}
+
+// latencies records the latencies of completed requests of a client.
+type latencies []time.Duration
+
+func summarize(all []latencies) LatencySummary {
+	count := 0
+	for _, l := range all {
+		count += len(l)
+	}
+	if count == 0 {
+		return LatencySummary{}
+	}
+	merged := make([]time.Duration, 0, count)
+	for _, l := range all {
+		merged = append(merged, l...)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i] < merged[j] })
+	total := time.Duration(0)
+	for _, v := range merged {
+		total += v
+	}
+	return LatencySummary{
+		Count: uint64(count),
+		Mean:  total / time.Duration(count),
+		P50:   percentile(merged, 0.5),
+		P90:   percentile(merged, 0.9),
+		P99:   percentile(merged, 0.99),
+		P999:  percentile(merged, 0.999),
+		Max:   merged[count-1],
+	}
+}
+
+// percentile returns the p-th percentile of the sorted values using the
+// nearest rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,131 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+var (
+	errInvalidCommand = errors.New("invalid command")
+)
+
+// encodeCommand encodes the key value pair into the command proposed to the
+// kvStateMachine.
+func encodeCommand(buf []byte, key []byte, value []byte) []byte {
+	buf = binary.AppendUvarint(buf[:0], uint64(len(key)))
+	buf = append(buf, key...)
+	return append(buf, value...)
+}
+
+func decodeCommand(cmd []byte) ([]byte, []byte, error) {
+	sz, n := binary.Uvarint(cmd)
+	if n <= 0 || uint64(len(cmd)-n) < sz {
+		return nil, nil, errInvalidCommand
+	}
+	key := cmd[n : n+int(sz)]
+	return key, cmd[n+int(sz):], nil
+}
+
+// kvStateMachine is the in-memory key value state machine used by the
+// benchmark.
+type kvStateMachine struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+var _ sm.IStateMachine = (*kvStateMachine)(nil)
+
+func newKVStateMachine(uint64, uint64) sm.IStateMachine {
+	return &kvStateMachine{data: make(map[string][]byte)}
+}
+
+func (s *kvStateMachine) Update(e sm.Entry) (sm.Result, error) {
+	key, value, err := decodeCommand(e.Cmd)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[string(key)] = append([]byte(nil), value...)
+	return sm.Result{Value: uint64(len(value))}, nil
+}
+
+func (s *kvStateMachine) Lookup(query interface{}) (interface{}, error) {
+	key, ok := query.([]byte)
+	if !ok {
+		return nil, errInvalidCommand
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.data[string(key)], nil
+}
+
+func (s *kvStateMachine) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf []byte
+	for _, k := range keys {
+		buf = encodeCommand(buf, []byte(k), s.data[k])
+		sz := binary.AppendUvarint(nil, uint64(len(buf)))
+		if _, err := w.Write(sz); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *kvStateMachine) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	kv := make(map[string][]byte)
+	for len(data) > 0 {
+		sz, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < sz {
+			return errInvalidCommand
+		}
+		key, value, err := decodeCommand(data[n : n+int(sz)])
+		if err != nil {
+			return err
+		}
+		kv[string(key)] = append([]byte(nil), value...)
+		data = data[n+int(sz):]
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = kv
+	return nil
+}
+
+func (s *kvStateMachine) Close() error { return nil }
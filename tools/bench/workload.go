@@ -0,0 +1,175 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"encoding/binary"
+	"math/rand"
+)
+
+// KeyDistribution is the distribution of keys accessed by the workload.
+type KeyDistribution uint8
+
+const (
+	// UniformKeys accesses all keys with the same probability.
+	UniformKeys KeyDistribution = iota
+	// ZipfianKeys accesses keys following a Zipfian distribution, a small
+	// number of hot keys are accessed most of the time.
+	ZipfianKeys
+	// SequentialKeys accesses keys one after another.
+	SequentialKeys
+)
+
+var keyDistributionNames = [...]string{
+	"uniform",
+	"zipfian",
+	"sequential",
+}
+
+func (d KeyDistribution) String() string {
+	if int(d) < len(keyDistributionNames) {
+		return keyDistributionNames[d]
+	}
+	return "unknown"
+}
+
+// ValueDistribution is the distribution of the sizes of written values.
+type ValueDistribution uint8
+
+const (
+	// FixedValues writes values of Workload.ValueSize bytes.
+	FixedValues ValueDistribution = iota
+	// UniformValues writes values with sizes uniformly distributed between
+	// Workload.MinValueSize and Workload.ValueSize bytes.
+	UniformValues
+)
+
+var valueDistributionNames = [...]string{
+	"fixed",
+	"uniform",
+}
+
+func (d ValueDistribution) String() string {
+	if int(d) < len(valueDistributionNames) {
+		return valueDistributionNames[d]
+	}
+	return "unknown"
+}
+
+const (
+	defaultKeys      = 10000
+	defaultValueSize = 128
+	zipfianS         = 1.1
+	zipfianV         = 1
+	keySize          = 16
+)
+
+// Workload describes the requests made by each client.
+type Workload struct {
+	// Keys is the number of distinct keys accessed by the workload.
+	Keys uint64
+	// KeyDistribution is the distribution of accessed keys.
+	KeyDistribution KeyDistribution
+	// ValueSize is the size of written values in bytes. It is the max size
+	// when ValueDistribution is UniformValues.
+	ValueSize int
+	// MinValueSize is the min size of written values in bytes when
+	// ValueDistribution is UniformValues.
+	MinValueSize int
+	// ValueDistribution is the distribution of the sizes of written values.
+	ValueDistribution ValueDistribution
+	// ReadRatio is the fraction of requests that are linearizable reads, in
+	// the range of [0, 1]. Other requests are proposals.
+	ReadRatio float64
+	// UseSessions indicates whether proposals are made using client sessions
+	// rather than NoOP sessions.
+	UseSessions bool
+}
+
+func (w Workload) withDefaults() Workload {
+	if w.Keys == 0 {
+		w.Keys = defaultKeys
+	}
+	if w.ValueSize == 0 {
+		w.ValueSize = defaultValueSize
+	}
+	if w.MinValueSize > w.ValueSize {
+		w.MinValueSize = w.ValueSize
+	}
+	return w
+}
+
+// op is a request made by a client.
+type op struct {
+	key   []byte
+	value []byte
+	read  bool
+}
+
+// generator generates the deterministic sequence of requests made by a client.
+// Two generators created with the same workload and seed generate the same
+// sequence.
+type generator struct {
+	w     Workload
+	rand  *rand.Rand
+	zipf  *rand.Zipf
+	next  uint64
+	key   []byte
+	value []byte
+}
+
+func newGenerator(w Workload, seed int64) *generator {
+	w = w.withDefaults()
+	g := &generator{
+		w:     w,
+		rand:  rand.New(rand.NewSource(seed)),
+		key:   make([]byte, keySize),
+		value: make([]byte, w.ValueSize),
+	}
+	if w.KeyDistribution == ZipfianKeys {
+		g.zipf = rand.NewZipf(g.rand, zipfianS, zipfianV, w.Keys-1)
+	}
+	return g
+}
+
+// nextOp returns the next request. The returned key and value are only valid
+// until the next call.
+func (g *generator) nextOp() op {
+	read := g.w.ReadRatio > 0 && g.rand.Float64() < g.w.ReadRatio
+	binary.BigEndian.PutUint64(g.key, g.nextKey())
+	if read {
+		return op{key: g.key, read: true}
+	}
+	size := g.w.ValueSize
+	if g.w.ValueDistribution == UniformValues && g.w.ValueSize > g.w.MinValueSize {
+		size = g.w.MinValueSize + g.rand.Intn(g.w.ValueSize-g.w.MinValueSize+1)
+	}
+	value := g.value[:size]
+	g.rand.Read(value)
+	return op{key: g.key, value: value}
+}
+
+func (g *generator) nextKey() uint64 {
+	switch g.w.KeyDistribution {
+	case ZipfianKeys:
+		return g.zipf.Uint64()
+	case SequentialKeys:
+		k := g.next % g.w.Keys
+		g.next++
+		return k
+	default:
+		return uint64(g.rand.Int63n(int64(g.w.Keys)))
+	}
+}
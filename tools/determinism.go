@@ -0,0 +1,594 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/logdb"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/utils/dio"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+const (
+	replayBatchSize = 4 * 1024 * 1024
+)
+
+var (
+	// ErrNonDeterministic indicates that two state machine instances have
+	// different states after having the same entries applied.
+	ErrNonDeterministic = errors.New("non-deterministic state machine")
+	// ErrStateNotComparable indicates that the states of the state machine
+	// instances can not be compared as the state machine implements neither
+	// statemachine.IFingerprint nor statemachine.IHash and no Diff function is
+	// specified.
+	ErrStateNotComparable = errors.New("state machine states not comparable")
+	// ErrReplicaNotFound indicates that the specified replica can not be found
+	// in the NodeHost directories.
+	ErrReplicaNotFound = errors.New("replica not found")
+)
+
+// DeterminismOption is the option type used by CheckDeterminism.
+type DeterminismOption struct {
+	// GOMAXPROCS is the GOMAXPROCS value set while entries are applied to the
+	// second state machine instance, the current value is kept when it is 0.
+	// GOMAXPROCS is a process wide setting, CheckDeterminism should not be
+	// invoked concurrently when it is set.
+	GOMAXPROCS int
+	// Perturb indicates whether the second state machine instance should yield
+	// the processor before each update. Go randomizes the iteration order of
+	// maps on every range loop, state machines relying on it are exposed
+	// without any perturbation, Perturb additionally exposes those relying on
+	// the scheduling order of goroutines.
+	Perturb bool
+	// Diff compares the states of the two state machine instances, it returns
+	// an error describing the difference when their states are different. The
+	// fingerprints returned by statemachine.IFingerprint, or the hashes returned
+	// by statemachine.IHash when IFingerprint is not implemented, are compared
+	// when Diff is nil.
+	Diff func(a sm.IStateMachine, b sm.IStateMachine) error
+	// Expert is the ExpertConfig used by the NodeHost. Its LogDB and Engine
+	// settings determine the LogDB shard storing the replica, default settings
+	// are used when they are empty. The LogDB is opened using LogDBFactory when
+	// it is set.
+	Expert config.ExpertConfig
+}
+
+// DeterminismResult describes the entries replayed by CheckDeterminism.
+type DeterminismResult struct {
+	// SnapshotIndex is the index of the snapshot both state machine instances
+	// were recovered from, it is 0 when there is no local snapshot.
+	SnapshotIndex uint64
+	// LastIndex is the index of the last committed entry applied to both state
+	// machine instances.
+	LastIndex uint64
+}
+
+// DivergenceError is the error returned by CheckDeterminism when the state
+// machine instances have different states.
+type DivergenceError struct {
+	// Index is the first index at which the states are different. It is the
+	// snapshot index when the states are different right after recovering from
+	// the snapshot.
+	Index uint64
+	// Difference describes the difference at Index.
+	Difference error
+}
+
+func (e *DivergenceError) Error() string {
+	return fmt.Sprintf("state machines diverged at index %d: %v",
+		e.Index, e.Difference)
+}
+
+// Unwrap returns ErrNonDeterministic.
+func (e *DivergenceError) Unwrap() error {
+	return ErrNonDeterministic
+}
+
+// CheckDeterminism replays the latest local snapshot and all committed entries
+// in the local Raft log of the specified replica into two independently
+// created instances of its state machine and compares their states, it is
+// used to catch state machines that cause silent divergence between replicas,
+// e.g. those relying on the iteration order of maps or on time.Now(). The
+// first instance is applied as is, the second one with the GOMAXPROCS and
+// Perturb settings specified in opt.
+//
+// A *DivergenceError is returned when the two instances end up with different
+// states. Its Index is the first index at which the states are different, it
+// is found by bisection with fresh instances replayed to the middle of the
+// remaining range on each step, divergence is thus assumed to persist once it
+// occurs.
+//
+// CheckDeterminism operates offline on the NodeHost directories specified by
+// nhDir and walDir, they are the NodeHostDir and WALDir values used by the
+// NodeHost, walDir should be empty when WALDir is not set. The directories may
+// be copied from another host, but they must not be used by a running
+// NodeHost instance. As opening the LogDB can modify its files, it is
+// recommended to run CheckDeterminism against a copy. Only replicas backed by
+// regular state machines are supported.
+func CheckDeterminism(ctx context.Context, nhDir string, walDir string,
+	shardID uint64, replicaID uint64, create sm.CreateStateMachineFunc,
+	opt DeterminismOption) (DeterminismResult, error) {
+	nhConfig := config.NodeHostConfig{
+		NodeHostDir: nhDir,
+		WALDir:      walDir,
+		Expert:      opt.Expert,
+	}
+	if nhConfig.Expert.FS == nil {
+		nhConfig.Expert.FS = vfs.DefaultFS
+	}
+	if nhConfig.Expert.LogDB.IsEmpty() {
+		nhConfig.Expert.LogDB = config.GetDefaultLogDBConfig()
+	}
+	if nhConfig.Expert.Engine.IsEmpty() {
+		nhConfig.Expert.Engine = config.GetDefaultEngineConfig()
+	}
+	return checkDeterminism(ctx, nhConfig, shardID, replicaID, create, opt)
+}
+
+func checkDeterminism(ctx context.Context, nhConfig config.NodeHostConfig,
+	shardID uint64, replicaID uint64, create sm.CreateStateMachineFunc,
+	opt DeterminismOption) (_ DeterminismResult, err error) {
+	fs := nhConfig.Expert.FS
+	dir, err := getDeploymentDir(nhConfig.NodeHostDir, fs)
+	if err != nil {
+		return DeterminismResult{}, err
+	}
+	lldir := dir
+	if len(nhConfig.WALDir) > 0 {
+		if lldir, err = getDeploymentDir(nhConfig.WALDir, fs); err != nil {
+			return DeterminismResult{}, err
+		}
+	}
+	var ldb raftio.ILogDB
+	if nhConfig.Expert.LogDBFactory != nil {
+		ldb, err = nhConfig.Expert.LogDBFactory.Create(nhConfig,
+			nil, []string{dir}, []string{lldir})
+	} else {
+		ldb, err = logdb.NewDefaultLogDB(nhConfig,
+			nil, []string{dir}, []string{lldir})
+	}
+	if err != nil {
+		return DeterminismResult{}, err
+	}
+	defer func() {
+		err = firstError(err, ldb.Close())
+	}()
+	r, err := newReplayer(ldb, dir, shardID, replicaID, create, opt, fs)
+	if err != nil {
+		return DeterminismResult{}, err
+	}
+	result := DeterminismResult{
+		SnapshotIndex: r.ss.Index,
+		LastIndex:     r.commit,
+	}
+	d, err := r.check(ctx, r.commit)
+	if err != nil || d == nil {
+		return result, err
+	}
+	plog.Warningf("%s diverged at index %d, bisecting (%d, %d]",
+		dn(shardID, replicaID), r.commit, r.ss.Index, r.commit)
+	if r.commit > r.ss.Index {
+		ssd, err := r.check(ctx, r.ss.Index)
+		if err != nil {
+			return result, err
+		}
+		if ssd != nil {
+			return result, ssd
+		}
+	}
+	lo, hi := r.ss.Index, r.commit
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		md, err := r.check(ctx, mid)
+		if err != nil {
+			return result, err
+		}
+		if md != nil {
+			hi, d = mid, md
+		} else {
+			lo = mid
+		}
+	}
+	return result, d
+}
+
+// getDeploymentDir returns the deployment ID directory in the specified
+// NodeHostDir or WALDir, it is expected to be the only directory found in the
+// only hostname directory.
+func getDeploymentDir(dir string, fs vfs.IFS) (string, error) {
+	for i := 0; i < 2; i++ {
+		names, err := listDirs(dir, fs)
+		if err != nil {
+			return "", err
+		}
+		if len(names) != 1 {
+			return "", errors.Newf("expected 1 directory in %s, found %v",
+				dir, names)
+		}
+		dir = fs.PathJoin(dir, names[0])
+	}
+	return dir, nil
+}
+
+func listDirs(dir string, fs vfs.IFS) ([]string, error) {
+	names, err := fs.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, name := range names {
+		fi, err := fs.Stat(fs.PathJoin(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			dirs = append(dirs, name)
+		}
+	}
+	return dirs, nil
+}
+
+// replayer replays the local snapshot and committed entries of a replica into
+// new state machine instances.
+type replayer struct {
+	ldb       raftio.ILogDB
+	fs        vfs.IFS
+	shardID   uint64
+	replicaID uint64
+	create    sm.CreateStateMachineFunc
+	opt       DeterminismOption
+	ssDir     string
+	ss        pb.Snapshot
+	rs        raftio.RaftState
+	commit    uint64
+}
+
+func newReplayer(ldb raftio.ILogDB, dir string, shardID uint64,
+	replicaID uint64, create sm.CreateStateMachineFunc,
+	opt DeterminismOption, fs vfs.IFS) (*replayer, error) {
+	bi, err := ldb.GetBootstrapInfo(shardID, replicaID)
+	if errors.Is(err, raftio.ErrNoBootstrapInfo) {
+		return nil, errors.Wrapf(ErrReplicaNotFound,
+			"%s", dn(shardID, replicaID))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bi.Type != pb.RegularStateMachine {
+		return nil, errors.Newf("%s has %s state machine, only regular state "+
+			"machines are supported", dn(shardID, replicaID), bi.Type)
+	}
+	r := &replayer{
+		ldb:       ldb,
+		fs:        fs,
+		shardID:   shardID,
+		replicaID: replicaID,
+		create:    create,
+		opt:       opt,
+	}
+	ss, err := ldb.GetSnapshot(shardID, replicaID)
+	if err != nil {
+		return nil, err
+	}
+	if !pb.IsEmptySnapshot(ss) {
+		if r.ssDir, err = getReplicaSnapshotDir(dir,
+			shardID, replicaID, fs); err != nil {
+			return nil, err
+		}
+		ss = r.rebase(ss)
+	}
+	r.ss = ss
+	r.commit = ss.Index
+	rs, err := ldb.ReadRaftState(shardID, replicaID, ss.Index)
+	if err != nil && !errors.Is(err, raftio.ErrNoSavedLog) {
+		return nil, err
+	}
+	if err == nil {
+		r.rs = rs
+		if rs.State.Commit > r.commit {
+			r.commit = rs.State.Commit
+		}
+	}
+	return r, nil
+}
+
+// getReplicaSnapshotDir returns the snapshot directory of the replica in the
+// specified deployment ID directory, the partition directory containing it is
+// looked up rather than derived so directories copied from other hosts work.
+func getReplicaSnapshotDir(dir string,
+	shardID uint64, replicaID uint64, fs vfs.IFS) (string, error) {
+	names, err := listDirs(dir, fs)
+	if err != nil {
+		return "", err
+	}
+	sd := fmt.Sprintf("snapshot-%d-%d", shardID, replicaID)
+	for _, name := range names {
+		if !strings.HasPrefix(name, "snapshot-part-") {
+			continue
+		}
+		fp := fs.PathJoin(dir, name, sd)
+		if _, err := fs.Stat(fp); err == nil {
+			return fp, nil
+		}
+	}
+	return "", errors.Newf("snapshot directory of %s not found in %s",
+		dn(shardID, replicaID), dir)
+}
+
+// rebase updates file paths recorded in the snapshot so they point to files
+// in the snapshot directory of the replica found in the local NodeHost
+// directory.
+func (r *replayer) rebase(ss pb.Snapshot) pb.Snapshot {
+	env := server.NewSSEnv(func(uint64, uint64) string { return r.ssDir },
+		r.shardID, r.replicaID, ss.Index, r.replicaID, server.SnapshotMode, r.fs)
+	ss.Filepath = env.GetFilepath()
+	files := make([]*pb.SnapshotFile, 0, len(ss.Files))
+	for _, f := range ss.Files {
+		rf := *f
+		rf.Filepath = r.fs.PathJoin(env.GetFinalDir(), r.fs.PathBase(f.Filepath))
+		files = append(files, &rf)
+	}
+	ss.Files = files
+	return ss
+}
+
+// check replays entries up to the specified index into two new state machine
+// instances and compares their states, a non-nil *DivergenceError is returned
+// when the states are different.
+func (r *replayer) check(ctx context.Context,
+	index uint64) (_ *DivergenceError, err error) {
+	a, err := r.open(ctx, index, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = firstError(err, a.close())
+	}()
+	b, err := r.open(ctx, index, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = firstError(err, b.close())
+	}()
+	if r.opt.Diff != nil {
+		if diff := r.opt.Diff(a.sm, b.sm); diff != nil {
+			return &DivergenceError{Index: index, Difference: diff}, nil
+		}
+		return nil, nil
+	}
+	fa, err := getFingerprint(a.sm)
+	if err != nil {
+		return nil, err
+	}
+	fb, err := getFingerprint(b.sm)
+	if err != nil {
+		return nil, err
+	}
+	if fa != fb {
+		return &DivergenceError{
+			Index:      index,
+			Difference: errors.Newf("fingerprint %d != %d", fa, fb),
+		}, nil
+	}
+	return nil, nil
+}
+
+func getFingerprint(s sm.IStateMachine) (uint64, error) {
+	if f, ok := s.(sm.IFingerprint); ok {
+		return f.Fingerprint()
+	}
+	if h, ok := s.(sm.IHash); ok {
+		return h.GetHash()
+	}
+	return 0, ErrStateNotComparable
+}
+
+// open creates a new state machine instance, recovers it from the snapshot
+// and applies all committed entries up to the specified index.
+func (r *replayer) open(ctx context.Context,
+	index uint64, perturbed bool) (_ *replayed, err error) {
+	if perturbed && r.opt.GOMAXPROCS > 0 {
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(r.opt.GOMAXPROCS))
+	}
+	node := &replayNode{
+		shardID:   r.shardID,
+		replicaID: r.replicaID,
+		stopc:     make(chan struct{}),
+	}
+	logReader := logdb.NewLogReader(r.shardID, r.replicaID, r.ldb)
+	logReader.SetCompactor(node)
+	if !pb.IsEmptySnapshot(r.ss) {
+		if err := logReader.ApplySnapshot(r.ss); err != nil {
+			return nil, err
+		}
+	}
+	if r.rs.EntryCount > 0 || r.rs.State.Commit > 0 {
+		logReader.SetState(r.rs.State)
+		logReader.SetRange(r.rs.FirstIndex, r.rs.EntryCount)
+	}
+	s := r.create(r.shardID, r.replicaID)
+	user := s
+	if perturbed && r.opt.Perturb {
+		user = &perturbedSM{IStateMachine: s}
+	}
+	cfg := config.Config{ShardID: r.shardID, ReplicaID: r.replicaID}
+	managed := rsm.NewNativeSM(cfg,
+		rsm.NewInMemStateMachine(user), node.stopc)
+	ss := &replaySnapshotter{ss: r.ss, fs: r.fs}
+	p := &replayed{
+		sm:    s,
+		rsm:   rsm.NewStateMachine(managed, ss, cfg, node, r.fs),
+		stopc: node.stopc,
+	}
+	defer func() {
+		if err != nil {
+			err = firstError(err, p.close())
+		}
+	}()
+	if _, err := p.rsm.Recover(rsm.Task{Recover: true, Initial: true}); err != nil {
+		return nil, err
+	}
+	current := r.ss.Index
+	batch := make([]rsm.Task, 0, 1)
+	for current < index {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		entries, err := logReader.Entries(current+1, index+1, replayBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		p.rsm.TaskQ().Add(rsm.Task{Entries: entries})
+		if _, err := p.rsm.Handle(batch); err != nil {
+			return nil, err
+		}
+		current = entries[len(entries)-1].Index
+	}
+	return p, nil
+}
+
+// replayed is a state machine instance with entries replayed.
+type replayed struct {
+	sm    sm.IStateMachine
+	rsm   *rsm.StateMachine
+	stopc chan struct{}
+}
+
+func (p *replayed) close() error {
+	close(p.stopc)
+	return p.rsm.Close()
+}
+
+// perturbedSM is a state machine yielding the processor before each update.
+type perturbedSM struct {
+	sm.IStateMachine
+}
+
+func (p *perturbedSM) Update(e sm.Entry) (sm.Result, error) {
+	runtime.Gosched()
+	return p.IStateMachine.Update(e)
+}
+
+// replaySnapshotter is the rsm.ISnapshotter used for recovering replayed state
+// machine instances from the local snapshot, it doesn't support creating new
+// snapshots.
+type replaySnapshotter struct {
+	ss pb.Snapshot
+	fs vfs.IFS
+}
+
+var _ rsm.ISnapshotter = (*replaySnapshotter)(nil)
+
+var errNoReplaySnapshot = errors.New("no snapshot")
+
+func (s *replaySnapshotter) GetSnapshot() (pb.Snapshot, error) {
+	if pb.IsEmptySnapshot(s.ss) {
+		return pb.Snapshot{}, errNoReplaySnapshot
+	}
+	return s.ss, nil
+}
+
+func (s *replaySnapshotter) IsNoSnapshotError(err error) bool {
+	return errors.Is(err, errNoReplaySnapshot)
+}
+
+func (s *replaySnapshotter) Shrunk(ss pb.Snapshot) (bool, error) {
+	return rsm.IsShrunkSnapshotFile(ss.Filepath, s.fs)
+}
+
+func (s *replaySnapshotter) Stream(rsm.IStreamable,
+	rsm.SSMeta, pb.IChunkSink) error {
+	return errors.New("streaming not supported when replaying")
+}
+
+func (s *replaySnapshotter) Save(rsm.ISavable,
+	rsm.SSMeta) (pb.Snapshot, rsm.SSEnv, error) {
+	return pb.Snapshot{}, rsm.SSEnv{},
+		errors.New("saving not supported when replaying")
+}
+
+func (s *replaySnapshotter) Load(ss pb.Snapshot,
+	sessions rsm.ILoadable, asm rsm.IRecoverable) (err error) {
+	files := make([]sm.SnapshotFile, 0, len(ss.Files))
+	for _, f := range ss.Files {
+		files = append(files, sm.SnapshotFile{
+			FileID:   f.FileId,
+			Filepath: f.Filepath,
+			Metadata: f.Metadata,
+		})
+	}
+	reader, header, err := rsm.NewSnapshotReader(ss.Filepath, s.fs)
+	if err != nil {
+		return err
+	}
+	ct := dio.NoCompression
+	if header.CompressionType == pb.Snappy {
+		ct = dio.Snappy
+	}
+	cr := dio.NewDecompressor(ct, reader)
+	defer func() {
+		err = firstError(err, cr.Close())
+	}()
+	if err := sessions.LoadSessions(cr, rsm.SSVersion(header.Version)); err != nil {
+		return err
+	}
+	return asm.Recover(cr, files)
+}
+
+// replayNode is the rsm.INode and the pb.ICompactor used by replayed state
+// machine instances, there is no raft node to be notified when entries are
+// applied and the Raft log is never compacted.
+type replayNode struct {
+	shardID   uint64
+	replicaID uint64
+	stopc     chan struct{}
+}
+
+var _ rsm.INode = (*replayNode)(nil)
+var _ pb.ICompactor = (*replayNode)(nil)
+
+func (n *replayNode) Compact(uint64) error { return nil }
+
+func (n *replayNode) StepReady() {}
+
+func (n *replayNode) RestoreRemotes(pb.Snapshot) error { return nil }
+
+func (n *replayNode) ApplyUpdate(pb.Entry, sm.Result, bool, bool, bool) {}
+
+func (n *replayNode) ApplyConfigChange(pb.ConfigChange,
+	uint64, bool, error) error {
+	return nil
+}
+
+func (n *replayNode) EntriesApplied([]pb.Entry) {}
+
+func (n *replayNode) ReplicaID() uint64 { return n.replicaID }
+
+func (n *replayNode) ShardID() uint64 { return n.shardID }
+
+func (n *replayNode) ShouldStop() <-chan struct{} { return n.stopc }
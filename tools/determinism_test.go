@@ -0,0 +1,232 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// clockSM folds all applied commands into its hash, the "now" command folds
+// the current time instead when the state machine is not deterministic.
+type clockSM struct {
+	deterministic bool
+	hash          uint64
+}
+
+func newClockSM(deterministic bool) sm.CreateStateMachineFunc {
+	return func(uint64, uint64) sm.IStateMachine {
+		return &clockSM{deterministic: deterministic, hash: 1}
+	}
+}
+
+func (s *clockSM) Update(e sm.Entry) (sm.Result, error) {
+	cmd := e.Cmd
+	if string(cmd) == "now" && !s.deterministic {
+		cmd = binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(binary.BigEndian.AppendUint64(nil, s.hash))
+	_, _ = h.Write(cmd)
+	s.hash = h.Sum64()
+	return sm.Result{Value: e.Index}, nil
+}
+
+func (s *clockSM) Lookup(query interface{}) (interface{}, error) {
+	return s.hash, nil
+}
+
+func (s *clockSM) Fingerprint() (uint64, error) {
+	return s.hash, nil
+}
+
+func (s *clockSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	_, err := w.Write(binary.BigEndian.AppendUint64(nil, s.hash))
+	return err
+}
+
+func (s *clockSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.hash = binary.BigEndian.Uint64(data)
+	return nil
+}
+
+func (s *clockSM) Close() error { return nil }
+
+// createClockSMReplica runs a single replica shard backed by clockSM in the
+// specified directory, a snapshot is created before the "now" command is
+// proposed. It returns the NodeHostDir and the index of the "now" command.
+func createClockSMReplica(t *testing.T,
+	dir string, deterministic bool) (string, uint64) {
+	t.Helper()
+	nhConfig := memtransport.NewNetwork().NodeHostConfigs(1, dir, 5)[0]
+	nhConfig.Expert.LogDB = config.GetTinyMemLogDBConfig()
+	nh, err := dragonboat.NewNodeHost(nhConfig)
+	if err != nil {
+		t.Fatalf("failed to create NodeHost %v", err)
+	}
+	defer nh.Close()
+	rc := config.Config{
+		ShardID:      1,
+		ReplicaID:    1,
+		ElectionRTT:  10,
+		HeartbeatRTT: 1,
+	}
+	members := map[uint64]string{1: nhConfig.RaftAddress}
+	if err := nh.StartReplica(members,
+		false, newClockSM(deterministic), rc); err != nil {
+		t.Fatalf("failed to start replica %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var index uint64
+	propose := func(cmd string) {
+		for {
+			r, err := nh.SyncPropose(ctx, nh.GetNoOPSession(1), []byte(cmd))
+			if err == nil {
+				index = r.Value
+				return
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("failed to propose %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		propose("set")
+	}
+	if _, err := nh.SyncRequestSnapshot(ctx,
+		1, dragonboat.SnapshotOption{}); err != nil {
+		t.Fatalf("failed to request snapshot %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		propose("set")
+	}
+	propose("now")
+	nowIndex := index
+	for i := 0; i < 10; i++ {
+		propose("set")
+	}
+	return nhConfig.NodeHostDir, nowIndex
+}
+
+// copyNodeHostDir moves the NodeHost directory to a new location to mimic an
+// offline copy.
+func copyNodeHostDir(t *testing.T, nhDir string) string {
+	t.Helper()
+	copied := filepath.Join(t.TempDir(), "copied")
+	if err := os.Rename(nhDir, copied); err != nil {
+		t.Fatalf("failed to move the NodeHost dir %v", err)
+	}
+	return copied
+}
+
+func TestCheckDeterminismPassesDeterministicStateMachine(t *testing.T) {
+	nhDir, _ := createClockSMReplica(t, t.TempDir(), true)
+	nhDir = copyNodeHostDir(t, nhDir)
+	opt := DeterminismOption{
+		GOMAXPROCS: 1,
+		Perturb:    true,
+		Expert:     config.ExpertConfig{LogDB: config.GetTinyMemLogDBConfig()},
+	}
+	result, err := CheckDeterminism(context.Background(),
+		nhDir, nhDir, 1, 1, newClockSM(true), opt)
+	if err != nil {
+		t.Fatalf("check failed %v", err)
+	}
+	if result.SnapshotIndex == 0 || result.LastIndex <= result.SnapshotIndex {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestCheckDeterminismReportsFirstDivergentIndex(t *testing.T) {
+	nhDir, nowIndex := createClockSMReplica(t, t.TempDir(), false)
+	nhDir = copyNodeHostDir(t, nhDir)
+	opt := DeterminismOption{
+		Expert: config.ExpertConfig{LogDB: config.GetTinyMemLogDBConfig()},
+	}
+	result, err := CheckDeterminism(context.Background(),
+		nhDir, nhDir, 1, 1, newClockSM(false), opt)
+	if !errors.Is(err, ErrNonDeterministic) {
+		t.Fatalf("divergence not reported, %v", err)
+	}
+	var de *DivergenceError
+	if !errors.As(err, &de) {
+		t.Fatalf("unexpected error type %T", err)
+	}
+	if de.Index != nowIndex {
+		t.Errorf("diverged at %d, want %d", de.Index, nowIndex)
+	}
+	if result.SnapshotIndex >= nowIndex || result.LastIndex <= nowIndex {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestCheckDeterminismUsesDiff(t *testing.T) {
+	nhDir, nowIndex := createClockSMReplica(t, t.TempDir(), false)
+	calls := 0
+	opt := DeterminismOption{
+		Expert: config.ExpertConfig{LogDB: config.GetTinyMemLogDBConfig()},
+		Diff: func(a sm.IStateMachine, b sm.IStateMachine) error {
+			calls++
+			ha, _ := a.Lookup(nil)
+			hb, _ := b.Lookup(nil)
+			if ha != hb {
+				return errors.Newf("hash %d != %d", ha, hb)
+			}
+			return nil
+		},
+	}
+	_, err := CheckDeterminism(context.Background(),
+		nhDir, nhDir, 1, 1, newClockSM(false), opt)
+	var de *DivergenceError
+	if !errors.As(err, &de) || de.Index != nowIndex {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if calls == 0 {
+		t.Errorf("Diff not called")
+	}
+}
+
+func TestCheckDeterminismReportsMissingReplica(t *testing.T) {
+	nhDir, _ := createClockSMReplica(t, t.TempDir(), true)
+	opt := DeterminismOption{
+		Expert: config.ExpertConfig{LogDB: config.GetTinyMemLogDBConfig()},
+	}
+	_, err := CheckDeterminism(context.Background(),
+		nhDir, nhDir, 2, 1, newClockSM(true), opt)
+	if !errors.Is(err, ErrReplicaNotFound) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -20,25 +20,23 @@ tools for managing Dragonboat based applications.
 */
 
 import (
-	"bytes"
 	"io"
-	"os"
-	"runtime"
 	"strings"
 
 	"github.com/cockroachdb/errors"
+	"github.com/lni/goutils/logutil"
 
 	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/barrier"
 	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/importer"
 	"github.com/lni/dragonboat/v4/internal/logdb"
-	"github.com/lni/dragonboat/v4/internal/rsm"
 	"github.com/lni/dragonboat/v4/internal/server"
 	"github.com/lni/dragonboat/v4/internal/settings"
 	"github.com/lni/dragonboat/v4/internal/utils"
 	"github.com/lni/dragonboat/v4/internal/vfs"
 	"github.com/lni/dragonboat/v4/logger"
 	"github.com/lni/dragonboat/v4/raftio"
-	pb "github.com/lni/dragonboat/v4/raftpb"
 )
 
 var (
@@ -48,17 +46,25 @@ var (
 var (
 	unmanagedDeploymentID = settings.UnmanagedDeploymentID
 	// ErrInvalidMembers indicates that the provided member nodes is invalid.
-	ErrInvalidMembers = errors.New("invalid members")
+	ErrInvalidMembers = importer.ErrInvalidMembers
 	// ErrPathNotExist indicates that the specified exported snapshot directory
 	// do not exist.
 	ErrPathNotExist = errors.New("path does not exist")
 	// ErrIncompleteSnapshot indicates that the specified exported snapshot
 	// directory does not contain a complete snapshot.
-	ErrIncompleteSnapshot = errors.New("snapshot is incomplete")
+	ErrIncompleteSnapshot = importer.ErrIncompleteSnapshot
+	// ErrInvalidSnapshotArchive indicates that the snapshot archive is corrupted
+	// or is not in a supported format.
+	ErrInvalidSnapshotArchive = importer.ErrInvalidArchive
+	// ErrIncompleteManifest indicates that the specified coordinated export
+	// has not exported snapshots of all its shards.
+	ErrIncompleteManifest = errors.New("incomplete barrier manifest")
 )
 
 var firstError = utils.FirstError
 
+var dn = logutil.DescribeNode
+
 // ImportSnapshot is used to repair the Raft shard already has its quorum
 // nodes permanently lost or damaged. Such repair is only required when the
 // Raft shard permanently lose its quorum. You are not suppose to use this
@@ -132,39 +138,127 @@ var firstError = utils.FirstError
 // It is your applications's responsibility to let m4 and m5 to be aware that
 // node 4 and 5 are now running there.
 func ImportSnapshot(nhConfig config.NodeHostConfig,
-	srcDir string, memberNodes map[uint64]string, replicaID uint64) (err error) {
-	if nhConfig.DeploymentID == 0 {
-		plog.Infof("NodeHostConfig.DeploymentID not set, default to %d",
-			unmanagedDeploymentID)
-		nhConfig.DeploymentID = unmanagedDeploymentID
+	srcDir string, memberNodes map[uint64]string, replicaID uint64) error {
+	return ImportSnapshotWithOption(nhConfig,
+		srcDir, memberNodes, replicaID, ImportOption{})
+}
+
+// ImportOption is the option type used by ImportSnapshotWithOption.
+type ImportOption struct {
+	// ShardID is the ID of the shard to import the snapshot to. When it is set
+	// to a value different from the ShardID of the exported snapshot, the shard
+	// that exported the snapshot is cloned as a new shard, e.g. to stand up a
+	// copy of a production shard in a staging environment. The shard ID and
+	// the membership recorded in the snapshot are rewritten to ShardID and
+	// memberNodes, replica IDs and addresses of the source shard can be freely
+	// reused or changed as the clone shares no history with the source shard.
+	// The state machine payload is copied as is. 0 means the ShardID of the
+	// exported snapshot.
+	ShardID uint64
+	// StripSessions indicates whether client sessions saved in the snapshot
+	// should be removed. They are preserved by default, which is usually what
+	// is expected when repairing a shard. When cloning a shard, the preserved
+	// sessions are shared by the source shard and the clone.
+	StripSessions bool
+}
+
+// ImportSnapshotWithOption is similar to ImportSnapshot, it allows the caller
+// to specify the ImportOption.
+func ImportSnapshotWithOption(nhConfig config.NodeHostConfig,
+	srcDir string, memberNodes map[uint64]string,
+	replicaID uint64, opt ImportOption) error {
+	getSource := func(fs vfs.IFS) (importer.ISource, error) {
+		if _, err := getSnapshotFilepath(srcDir, fs); err != nil {
+			return nil, err
+		}
+		return importer.NewDirSource(srcDir, fs), nil
 	}
-	if nhConfig.Expert.FS == nil {
-		nhConfig.Expert.FS = vfs.DefaultFS
+	return importSnapshot(nhConfig, getSource, memberNodes, replicaID, opt)
+}
+
+// ImportSnapshotArchive is similar to ImportSnapshotWithOption, the exported
+// snapshot is read from r as a snapshot archive written by the ExportSink
+// returned by dragonboat.NewArchiveExportSink rather than from an exported
+// snapshot directory. r is read sequentially, it can be a download stream from
+// an object store. ErrInvalidSnapshotArchive is returned when the manifest of
+// the archive is corrupted or when any file fails its checksum check.
+func ImportSnapshotArchive(nhConfig config.NodeHostConfig,
+	r io.Reader, memberNodes map[uint64]string,
+	replicaID uint64, opt ImportOption) error {
+	getSource := func(vfs.IFS) (importer.ISource, error) {
+		return importer.NewArchiveSource(r)
+	}
+	return importSnapshot(nhConfig, getSource, memberNodes, replicaID, opt)
+}
+
+// ImportBarrierManifest imports all snapshots exported to the specified dir by
+// the SyncCoordinatedExport method of NodeHost, i.e. it restores the state of
+// multiple shards captured at mutually consistent barriers. memberNodes
+// specifies the members of each shard keyed by shard ID, the local replica of
+// each shard is identified by replicaID. Snapshots are imported one shard at a
+// time in the same way as ImportSnapshot, the same requirements apply.
+//
+// ErrIncompleteManifest is returned when the export is incomplete, it should be
+// resumed by invoking SyncCoordinatedExport again. ErrInvalidMembers is
+// returned when memberNodes doesn't contain all shards in the manifest. The
+// import can be retried when it fails, imported snapshots are overwritten.
+func ImportBarrierManifest(nhConfig config.NodeHostConfig, dir string,
+	memberNodes map[uint64]map[uint64]string, replicaID uint64) error {
+	fs := nhConfig.Expert.FS
+	if fs == nil {
+		fs = vfs.DefaultFS
 	}
-	if err := nhConfig.Prepare(); err != nil {
+	m, err := barrier.Read(dir, fs)
+	if err != nil {
 		return err
 	}
-	fs := nhConfig.Expert.FS
-	if err := checkImportSettings(nhConfig, memberNodes, replicaID); err != nil {
+	if !m.Complete() {
+		return ErrIncompleteManifest
+	}
+	for _, s := range m.Shards {
+		if _, ok := memberNodes[s.ShardID]; !ok {
+			plog.Errorf("shard %d not found in the memberNodes map", s.ShardID)
+			return ErrInvalidMembers
+		}
+	}
+	for _, s := range m.Shards {
+		srcDir := fs.PathJoin(dir, s.Path)
+		if err := ImportSnapshot(nhConfig,
+			srcDir, memberNodes[s.ShardID], replicaID); err != nil {
+			return errors.Wrapf(err, "shard %d", s.ShardID)
+		}
+		plog.Infof("%s imported snapshot %d, barrier %d",
+			dn(s.ShardID, replicaID), s.SnapshotIndex, s.BarrierIndex)
+	}
+	return nil
+}
+
+func importSnapshot(nhConfig config.NodeHostConfig,
+	getSource func(vfs.IFS) (importer.ISource, error),
+	memberNodes map[uint64]string, replicaID uint64,
+	opt ImportOption) (err error) {
+	if err := prepareNodeHostConfig(&nhConfig); err != nil {
 		return err
 	}
-	ssfp, err := getSnapshotFilepath(srcDir, fs)
-	if err != nil {
+	fs := nhConfig.Expert.FS
+	if err := checkImportSettings(nhConfig, memberNodes, replicaID); err != nil {
 		return err
 	}
-	oldss, err := getSnapshotRecord(srcDir, server.MetadataFilename, fs)
+	src, err := getSource(fs)
 	if err != nil {
 		return err
 	}
-	ok, err := isCompleteSnapshotImage(ssfp, oldss, fs)
+	oldss, err := importer.GetSnapshotRecord(src)
 	if err != nil {
 		return err
 	}
-	if !ok {
-		return ErrIncompleteSnapshot
+	if opt.ShardID == 0 {
+		opt.ShardID = oldss.ShardID
 	}
-	if err := checkMembers(oldss.Membership, memberNodes); err != nil {
-		return err
+	if opt.ShardID == oldss.ShardID {
+		if err := importer.CheckMembers(oldss.Membership, memberNodes); err != nil {
+			return err
+		}
 	}
 	env, err := server.NewEnv(nhConfig, fs)
 	if err != nil {
@@ -188,65 +282,42 @@ func ImportSnapshot(nhConfig config.NodeHostConfig,
 		return err
 	}
 	ssDir := env.GetSnapshotDir(nhConfig.DeploymentID,
-		oldss.ShardID, replicaID)
+		opt.ShardID, replicaID)
 	exist, err := fileutil.Exist(ssDir, fs)
 	if err != nil {
 		return err
 	}
 	if exist {
-		if err := cleanupSnapshotDir(ssDir, fs); err != nil {
+		if err := importer.CleanupSnapshotDir(ssDir, fs); err != nil {
 			return err
 		}
 	} else {
 		if err := env.CreateSnapshotDir(nhConfig.DeploymentID,
-			oldss.ShardID, replicaID); err != nil {
+			opt.ShardID, replicaID); err != nil {
 			return err
 		}
 	}
 	getSnapshotDir := func(cid uint64, nid uint64) string {
 		return env.GetSnapshotDir(nhConfig.DeploymentID, cid, nid)
 	}
-	ssEnv := server.NewSSEnv(getSnapshotDir,
-		oldss.ShardID, replicaID, oldss.Index, replicaID, server.SnapshotMode, fs)
-	if err := ssEnv.CreateTempDir(); err != nil {
-		return err
+	iopts := importer.Options{
+		ShardID:       opt.ShardID,
+		StripSessions: opt.StripSessions,
 	}
-	dstDir := ssEnv.GetTempDir()
-	finalDir := ssEnv.GetFinalDir()
-	ss := getProcessedSnapshotRecord(finalDir, oldss, memberNodes, fs)
-	if err := copySnapshot(oldss, srcDir, dstDir, fs); err != nil {
-		return err
-	}
-	if err := ssEnv.FinalizeSnapshot(&ss); err != nil {
-		return err
-	}
-	return logdb.ImportSnapshot(ss, replicaID)
+	return importer.Install(logdb,
+		getSnapshotDir, oldss, src, memberNodes, replicaID, iopts, fs)
 }
 
-func cleanupSnapshotDir(dir string, fs vfs.IFS) error {
-	files, err := fs.List(dir)
-	if err != nil {
-		return err
+func prepareNodeHostConfig(nhConfig *config.NodeHostConfig) error {
+	if nhConfig.DeploymentID == 0 {
+		plog.Infof("NodeHostConfig.DeploymentID not set, default to %d",
+			unmanagedDeploymentID)
+		nhConfig.DeploymentID = unmanagedDeploymentID
 	}
-	for _, v := range files {
-		fi, err := fs.Stat(fs.PathJoin(dir, v))
-		if err != nil {
-			return err
-		}
-		if !fi.IsDir() {
-			continue
-		}
-		name := []byte(fi.Name())
-		if server.SnapshotDirNameRe.Match(name) ||
-			server.GenSnapshotDirNameRe.Match(name) ||
-			server.RecvSnapshotDirNameRe.Match(name) {
-			ssdir := fs.PathJoin(dir, fi.Name())
-			if err := fs.RemoveAll(ssdir); err != nil {
-				return err
-			}
-		}
+	if nhConfig.Expert.FS == nil {
+		nhConfig.Expert.FS = vfs.DefaultFS
 	}
-	return fileutil.SyncDir(dir, fs)
+	return nhConfig.Prepare()
 }
 
 func checkImportSettings(nhConfig config.NodeHostConfig,
@@ -264,15 +335,6 @@ func checkImportSettings(nhConfig config.NodeHostConfig,
 	return nil
 }
 
-func isCompleteSnapshotImage(ssfp string,
-	ss pb.Snapshot, fs vfs.IFS) (bool, error) {
-	checksum, err := rsm.GetV2PayloadChecksum(ssfp, fs)
-	if err != nil {
-		return false, err
-	}
-	return bytes.Equal(checksum, ss.Checksum), nil
-}
-
 func getSnapshotFilepath(dir string, fs vfs.IFS) (string, error) {
 	exist, err := fileutil.Exist(dir, fs)
 	if err != nil {
@@ -324,153 +386,6 @@ func getSnapshotFilenames(path string, fs vfs.IFS) ([]string, error) {
 	return results, nil
 }
 
-func getSnapshotRecord(dir string,
-	filename string, fs vfs.IFS) (pb.Snapshot, error) {
-	var ss pb.Snapshot
-	if err := fileutil.GetFlagFileContent(dir, filename, &ss, fs); err != nil {
-		return pb.Snapshot{}, err
-	}
-	return ss, nil
-}
-
-func checkMembers(old pb.Membership, members map[uint64]string) error {
-	for replicaID, addr := range members {
-		v, ok := old.Addresses[replicaID]
-		if ok && v != addr {
-			return errors.New("node address changed")
-		}
-		v, ok = old.NonVotings[replicaID]
-		if ok && v != addr {
-			return errors.New("node address changed")
-		}
-		if ok {
-			return errors.New("adding an nonVoting as regular node")
-		}
-		v, ok = old.Witnesses[replicaID]
-		if ok && v != addr {
-			return errors.New("node address changed")
-		}
-		if ok {
-			return errors.New("adding a witness as regular node")
-		}
-		_, ok = old.Removed[replicaID]
-		if ok {
-			return errors.New("adding a removed node")
-		}
-	}
-	return nil
-}
-
-func getProcessedSnapshotRecord(dstDir string,
-	old pb.Snapshot, members map[uint64]string, fs vfs.IFS) pb.Snapshot {
-	for _, file := range old.Files {
-		file.Filepath = fs.PathJoin(dstDir, fs.PathBase(file.Filepath))
-	}
-	ss := pb.Snapshot{
-		Filepath: fs.PathJoin(dstDir, fs.PathBase(old.Filepath)),
-		FileSize: old.FileSize,
-		Index:    old.Index,
-		Term:     old.Term,
-		Checksum: old.Checksum,
-		Dummy:    old.Dummy,
-		Membership: pb.Membership{
-			ConfigChangeId: old.Index,
-			Removed:        make(map[uint64]bool),
-			NonVotings:     make(map[uint64]string),
-			Addresses:      make(map[uint64]string),
-			Witnesses:      make(map[uint64]string),
-		},
-		Files:    old.Files,
-		Type:     old.Type,
-		ShardID:  old.ShardID,
-		Imported: true,
-	}
-	for nid := range old.Membership.Addresses {
-		_, ok := members[nid]
-		if !ok {
-			ss.Membership.Removed[nid] = true
-		}
-	}
-	for nid := range old.Membership.NonVotings {
-		_, ok := members[nid]
-		if !ok {
-			ss.Membership.Removed[nid] = true
-		}
-	}
-	for nid := range old.Membership.Witnesses {
-		_, ok := members[nid]
-		if !ok {
-			ss.Membership.Removed[nid] = true
-		}
-	}
-	for nid := range old.Membership.Removed {
-		ss.Membership.Removed[nid] = true
-	}
-	for nid, addr := range members {
-		ss.Membership.Addresses[nid] = addr
-	}
-	return ss
-}
-
-func copySnapshot(ss pb.Snapshot,
-	srcDir string, dstDir string, fs vfs.IFS) error {
-	fp, err := getSnapshotFilepath(srcDir, fs)
-	if err != nil {
-		return err
-	}
-	dstfp := fs.PathJoin(dstDir, fs.PathBase(fp))
-	if err := copyFile(fp, dstfp, fs); err != nil {
-		return err
-	}
-	for _, file := range ss.Files {
-		fname := fs.PathBase(file.Filepath)
-		if err := copyFile(fs.PathJoin(srcDir, fname),
-			fs.PathJoin(dstDir, fname), fs); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func copyFile(src string, dst string, fs vfs.IFS) (err error) {
-	in, err := fs.Open(src)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err = firstError(err, in.Close())
-	}()
-	fi, err := in.Stat()
-	if err != nil {
-		return err
-	}
-	out, err := fs.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err = firstError(err, out.Close())
-	}()
-	if runtime.GOOS != "windows" {
-		type chmod interface {
-			Chmod(mode os.FileMode) error
-		}
-		of, ok := out.(chmod)
-		if ok {
-			if err := of.Chmod(fi.Mode()); err != nil {
-				return err
-			}
-		}
-	}
-	if _, err = io.Copy(out, in); err != nil {
-		return err
-	}
-	if err := out.Sync(); err != nil {
-		return err
-	}
-	return fileutil.SyncDir(fs.PathDir(dst), fs)
-}
-
 func getLogDB(env server.Env,
 	nhConfig config.NodeHostConfig) (raftio.ILogDB, error) {
 	nhDir, walDir := env.GetLogDBDirs(nhConfig.DeploymentID)
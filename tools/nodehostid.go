@@ -0,0 +1,81 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+var (
+	// ErrNodeHostIDNotFound indicates that there is no NodeHostID recorded in
+	// the specified NodeHost directory.
+	ErrNodeHostIDNotFound = server.ErrNodeHostIDNotFound
+	// ErrNodeHostIDChanged indicates that a different NodeHostID has already
+	// been recorded in the specified NodeHost directory.
+	ErrNodeHostIDChanged = server.ErrNodeHostIDChanged
+	// ErrInvalidNodeHostID indicates that the specified value is not a valid
+	// NodeHostID.
+	ErrInvalidNodeHostID = server.ErrInvalidNodeHostID
+	// ErrCorruptedNodeHostID indicates that the NodeHostID file found in the
+	// specified NodeHost directory is corrupted.
+	ErrCorruptedNodeHostID = fileutil.ErrCorruptedFlagFile
+)
+
+// ReadNodeHostID returns the NodeHostID recorded in the specified NodeHost
+// directory, i.e. the NodeHostConfig.NodeHostDir directory used by the
+// NodeHost instance. ErrNodeHostIDNotFound is returned when no NodeHostID has
+// been recorded and ErrCorruptedNodeHostID is returned when the recorded
+// NodeHostID can not be read.
+//
+// ReadNodeHostID is typically invoked by a DevOps tool when backing up a
+// NodeHost directory, the returned value can be saved alongside the backup and
+// be restored using WriteNodeHostID.
+func ReadNodeHostID(dataDir string) (string, error) {
+	return server.ReadNodeHostID(dataDir, vfs.DefaultFS)
+}
+
+// WriteNodeHostID records the specified NodeHostID in the specified NodeHost
+// directory, the directory is created when it doesn't exist. The file and its
+// parent directory are synced before WriteNodeHostID returns. The recorded
+// NodeHostID is never overwritten, ErrNodeHostIDChanged is returned when a
+// different NodeHostID has already been recorded, writing the same NodeHostID
+// again is a no-op. ErrInvalidNodeHostID is returned when nhID is not a valid
+// NodeHostID value.
+//
+// WriteNodeHostID allows a host to be replaced while preserving its identity,
+// which is required when replicas are addressed by NodeHostID values, e.g.
+// when NodeHostConfig.DefaultNodeRegistryEnabled is set. To replace a host -
+//
+// 1. obtain the NodeHostID of the host to be replaced, e.g. using NodeHost's
+// ID method or by calling ReadNodeHostID on a backup of its NodeHost directory
+//
+// 2. on the new host, restore the NodeHost directory from backup or call
+// WriteNodeHostID on an empty directory when no data is to be restored. Note
+// that restored Raft data is only used when the new host has the same hostname
+// as the replaced one
+//
+// 3. start the NodeHost instance on the new host with the NodeHostID field of
+// its NodeHostConfig set to the preserved NodeHostID, creating the NodeHost
+// instance fails with ErrNodeHostIDChanged when the directory contains a
+// different NodeHostID
+//
+// The new host can use a different RaftAddress, other NodeHost instances learn
+// the new RaftAddress of the preserved NodeHostID from gossip. The NodeHost
+// instance on the replaced host must never be started again.
+func WriteNodeHostID(dataDir string, nhID string) error {
+	return server.WriteNodeHostID(dataDir, nhID, vfs.DefaultFS)
+}
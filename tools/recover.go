@@ -0,0 +1,166 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"math"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+var (
+	// ErrLockDirectory indicates that the NodeHost directories are locked by a
+	// running NodeHost instance.
+	ErrLockDirectory = server.ErrLockDirectory
+	// ErrInvalidRecoveryMembers indicates that the specified members can not be
+	// used as the recovered membership of the replica.
+	ErrInvalidRecoveryMembers = rsm.ErrInvalidRecoveryMembers
+)
+
+// UnsafeRecoverMembership forcibly rewrites the membership of a replica whose
+// Raft shard permanently lost its quorum, the replica is made the member of a
+// shard with the specified members once restarted. Unlike ImportSnapshot, no
+// exported snapshot is required, the state of the replica including all entries
+// in its Raft log is preserved.
+//
+// UnsafeRecoverMembership is UNSAFE. All entries in the Raft log of the replica
+// are considered as committed, including those that were never committed by
+// the lost quorum, and all entries committed by the lost quorum but not
+// received by the replica are lost. It should only be used on the most up to
+// date surviving replica when the shard can not be repaired by any other
+// means. Other surviving replicas must never be restarted once the membership
+// has been rewritten.
+//
+// Config change entries removing members not included in members and adding
+// new members are appended to the Raft log of the replica starting from its
+// last index + 1, they are marked as committed together with all existing
+// entries. All specified members are regular nodes, members should include
+// the replica itself with the RaftAddress of nhConfig. New members specified
+// in members should join the shard in the same way as nodes added by
+// SyncRequestAddReplica, it is usually simpler to recover the replica as the
+// only member and add new nodes using the NodeHost API once the replica is
+// restarted. The recovery is recorded in the bootstrap info of the replica and
+// is reported by NodeHost.DumpRaftState from then on.
+//
+// UnsafeRecoverMembership operates offline on the NodeHost directories
+// specified by nhConfig.NodeHostDir and nhConfig.WALDir, nhConfig should be
+// the same as the one used to start the NodeHost instance. ErrLockDirectory is
+// returned when the directories are locked by a running NodeHost instance.
+// The replica can be restarted with empty initial members once the function
+// returns.
+func UnsafeRecoverMembership(nhConfig config.NodeHostConfig,
+	shardID uint64, replicaID uint64, members map[uint64]string) (err error) {
+	if err := prepareNodeHostConfig(&nhConfig); err != nil {
+		return err
+	}
+	if err := checkImportSettings(nhConfig, members, replicaID); err != nil {
+		return err
+	}
+	fs := nhConfig.Expert.FS
+	env, err := server.NewEnv(nhConfig, fs)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, env.Close())
+	}()
+	if _, _, err := env.CreateNodeHostDir(nhConfig.DeploymentID); err != nil {
+		return err
+	}
+	if err := env.LockNodeHostDir(); err != nil {
+		return err
+	}
+	logdb, err := getLogDB(*env, nhConfig)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, logdb.Close())
+	}()
+	if err := env.CheckNodeHostDir(nhConfig,
+		logdb.BinaryFormat(), logdb.Name()); err != nil {
+		return err
+	}
+	bi, err := logdb.GetBootstrapInfo(shardID, replicaID)
+	if err != nil {
+		return err
+	}
+	ss, err := logdb.GetSnapshot(shardID, replicaID)
+	if err != nil {
+		return err
+	}
+	rs, err := logdb.ReadRaftState(shardID, replicaID, ss.Index)
+	if err != nil {
+		return err
+	}
+	lastIndex := ss.Index
+	if rs.EntryCount > 0 {
+		lastIndex = rs.FirstIndex + rs.EntryCount - 1
+	}
+	entries, _, err := logdb.IterateEntries(nil, 0,
+		shardID, replicaID, ss.Index+1, lastIndex+1, math.MaxUint64)
+	if err != nil {
+		return err
+	}
+	if uint64(len(entries)) != lastIndex-ss.Index {
+		return errors.Newf("missing log entries, snapshot %d, last %d, found %d",
+			ss.Index, lastIndex, len(entries))
+	}
+	current := rsm.ReplayMembership(shardID,
+		replicaID, ss.Membership, entries)
+	ccs, err := rsm.GetRecoveryConfigChanges(shardID,
+		replicaID, current, members)
+	if err != nil {
+		return err
+	}
+	plog.Warningf("UNSAFE membership recovery of %s, members %v -> %v",
+		dn(shardID, replicaID), current.Addresses, members)
+	plog.Warningf("UNSAFE membership recovery of %s, entries (%d, %d] "+
+		"considered as committed", dn(shardID, replicaID),
+		rs.State.Commit, lastIndex)
+	update := pb.Update{
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		State:     rs.State,
+	}
+	for i := range ccs {
+		update.EntriesToSave = append(update.EntriesToSave, pb.Entry{
+			Type:  pb.ConfigChangeEntry,
+			Index: lastIndex + uint64(i) + 1,
+			Term:  rs.State.Term,
+			Cmd:   pb.MustMarshal(&ccs[i]),
+		})
+	}
+	update.State.Commit = lastIndex + uint64(len(ccs))
+	if err := logdb.SaveRaftState([]pb.Update{update}, 1); err != nil {
+		return err
+	}
+	bi.UnsafeRecoveries++
+	bi.UnsafeRecoveryIndex = lastIndex + 1
+	bi.UnsafeRecoveryTime = time.Now().Unix()
+	if err := logdb.SaveBootstrapInfo(shardID, replicaID, bi); err != nil {
+		return err
+	}
+	plog.Warningf("UNSAFE membership recovery of %s completed, %d config "+
+		"changes appended at index %d", dn(shardID, replicaID),
+		len(ccs), lastIndex+1)
+	return nil
+}
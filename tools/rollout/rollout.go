@@ -0,0 +1,491 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package rollout provides a coordinator for restarting a fleet of NodeHost
+instances one wave at a time without having any Raft shard lose its quorum.
+
+The coordinator computes the restart order from shard placements reported by
+the registry, NodeHost instances that co-host replicas of the same shard are
+only restarted in the same wave when the shard still retains its quorum with
+all of them restarted. Before each wave, leaderships are transferred off the
+NodeHost instances to be restarted, the coordinator then waits for the fleet
+to settle and for all involved shards to be led elsewhere with a quorum of
+live voting replicas elsewhere before it signals the operator that the wave
+can be restarted. The coordinator never restarts anything itself, the actual
+restart is performed by the operator.
+*/
+package rollout
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/logger"
+)
+
+var (
+	plog = logger.GetLogger("rollout")
+)
+
+var (
+	// ErrUnhealthy indicates that shards involved in the current wave did not
+	// become healthy within the configured HealthTimeout.
+	ErrUnhealthy = errors.New("shards not healthy")
+	// ErrUnknownHost indicates that a host to be restarted is not known to the
+	// registry.
+	ErrUnknownHost = errors.New("unknown host")
+)
+
+const (
+	defaultSettleTime      = 10 * time.Second
+	defaultHealthTimeout   = time.Minute
+	defaultTransferTimeout = 5 * time.Second
+	defaultPollInterval    = time.Second
+)
+
+// ILeaderTransferer is the interface used by the coordinator to transfer the
+// leadership of Raft shards. *dragonboat.NodeHost implements this interface.
+type ILeaderTransferer interface {
+	SyncRequestLeaderTransfer(ctx context.Context, shardID uint64,
+		targetReplicaID uint64, opt dragonboat.LeaderTransferOption) error
+}
+
+// Config is the coordinator configuration.
+type Config struct {
+	// Hosts is the NodeHostID values of NodeHost instances to be restarted,
+	// all NodeHost instances found in shard placements are restarted when
+	// Hosts is empty.
+	Hosts []string
+	// SettleTime is the time to wait after leaderships have been transferred
+	// off a wave before checking the health of involved shards. The default
+	// value of 10 seconds is used when SettleTime is 0.
+	SettleTime time.Duration
+	// HealthTimeout is the max time to wait for involved shards to become
+	// healthy, both before a wave is restarted and after it has been
+	// restarted. The default value of 1 minute is used when HealthTimeout is 0.
+	HealthTimeout time.Duration
+	// TransferTimeout is the timeout of each leader transfer. The default
+	// value of 5 seconds is used when TransferTimeout is 0.
+	TransferTimeout time.Duration
+	// PollInterval is the interval between shard health checks. The default
+	// value of 1 second is used when PollInterval is 0.
+	PollInterval time.Duration
+}
+
+// Coordinator coordinates rolling restarts of NodeHost instances.
+type Coordinator struct {
+	cfg           Config
+	getPlacements func() ([]dragonboat.ShardPlacement, error)
+	getTransferer func(nhID string) ILeaderTransferer
+	safeToRestart func(ctx context.Context, nhID string) error
+}
+
+// NewCoordinator creates a new coordinator instance. The getPlacements func
+// is invoked to get the up to date view of all shards, it is usually the
+// ListShards method of the registry returned by NodeHost.GetNodeHostRegistry.
+// The getTransferer func returns the ILeaderTransferer used for transferring
+// leaderships held by the specified NodeHost instance. The safeToRestart func
+// is invoked for each NodeHost instance once it is safe to restart it, it is
+// expected to return after the restart has been initiated, NodeHost instances
+// of the same wave can be restarted concurrently.
+func NewCoordinator(cfg Config,
+	getPlacements func() ([]dragonboat.ShardPlacement, error),
+	getTransferer func(nhID string) ILeaderTransferer,
+	safeToRestart func(ctx context.Context, nhID string) error) *Coordinator {
+	if cfg.SettleTime == 0 {
+		cfg.SettleTime = defaultSettleTime
+	}
+	if cfg.HealthTimeout == 0 {
+		cfg.HealthTimeout = defaultHealthTimeout
+	}
+	if cfg.TransferTimeout == 0 {
+		cfg.TransferTimeout = defaultTransferTimeout
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+	return &Coordinator{
+		cfg:           cfg,
+		getPlacements: getPlacements,
+		getTransferer: getTransferer,
+		safeToRestart: safeToRestart,
+	}
+}
+
+// Plan returns the planned restart waves based on the current view of all
+// shards. Each wave is a list of NodeHostID values of NodeHost instances that
+// can be restarted at the same time.
+func (c *Coordinator) Plan() ([][]string, error) {
+	placements, err := c.getPlacements()
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := c.getHosts(placements, nil)
+	if err != nil {
+		return nil, err
+	}
+	return plan(placements, hosts), nil
+}
+
+// Run restarts all hosts wave by wave until all of them have been restarted
+// or the context is done. It returns the NodeHostID values of hosts that have
+// been restarted. The plan is re-evaluated before each wave so membership
+// changes made during the rollout are taken into account.
+func (c *Coordinator) Run(ctx context.Context) ([]string, error) {
+	restarted := make(map[string]struct{})
+	var done []string
+	for {
+		placements, err := c.getPlacements()
+		if err != nil {
+			return done, err
+		}
+		hosts, err := c.getHosts(placements, restarted)
+		if err != nil {
+			return done, err
+		}
+		if len(hosts) == 0 {
+			return done, nil
+		}
+		waves := plan(placements, hosts)
+		wave := toSet(waves[0])
+		plog.Infof("restarting wave %v, %d waves remaining", waves[0], len(waves))
+		if err := c.prepare(ctx, wave); err != nil {
+			return done, err
+		}
+		for _, nhID := range waves[0] {
+			if err := c.safeToRestart(ctx, nhID); err != nil {
+				return done, err
+			}
+			restarted[nhID] = struct{}{}
+			done = append(done, nhID)
+		}
+		if err := c.waitForRejoined(ctx, wave); err != nil {
+			return done, err
+		}
+	}
+}
+
+// getHosts returns the hosts to be restarted that have not been restarted.
+func (c *Coordinator) getHosts(placements []dragonboat.ShardPlacement,
+	restarted map[string]struct{}) ([]string, error) {
+	known := make(map[string]struct{})
+	for _, p := range placements {
+		for _, r := range p.Replicas {
+			known[r.NodeHostID] = struct{}{}
+		}
+	}
+	var hosts []string
+	if len(c.cfg.Hosts) == 0 {
+		for nhID := range known {
+			hosts = append(hosts, nhID)
+		}
+		sort.Strings(hosts)
+	} else {
+		for _, nhID := range c.cfg.Hosts {
+			if _, ok := known[nhID]; !ok {
+				return nil, errors.Wrapf(ErrUnknownHost, "host %s", nhID)
+			}
+			hosts = append(hosts, nhID)
+		}
+	}
+	result := hosts[:0]
+	for _, nhID := range hosts {
+		if _, ok := restarted[nhID]; !ok {
+			result = append(result, nhID)
+		}
+	}
+	return result, nil
+}
+
+// prepare transfers leaderships off hosts in the wave, it returns once all
+// shards involved in the wave are healthy without the wave.
+func (c *Coordinator) prepare(ctx context.Context,
+	wave map[string]struct{}) error {
+	placements, err := c.getPlacements()
+	if err != nil {
+		return err
+	}
+	c.transferLeaderships(ctx, placements, wave)
+	if err := sleep(ctx, c.cfg.SettleTime); err != nil {
+		return err
+	}
+	return c.waitForHealthy(ctx, wave)
+}
+
+// waitForHealthy waits until all shards with replicas in the wave are healthy
+// with hosts in the wave considered as unavailable. Leaderships still held by
+// hosts in the wave are transferred again on each poll.
+func (c *Coordinator) waitForHealthy(ctx context.Context,
+	wave map[string]struct{}) error {
+	return c.poll(ctx, func(placements []dragonboat.ShardPlacement) (uint64, bool) {
+		shardID, ok := checkHealth(placements, wave)
+		if !ok {
+			c.transferLeaderships(ctx, placements, wave)
+		}
+		return shardID, ok
+	})
+}
+
+// waitForRejoined waits until hosts in the restarted wave have rejoined all
+// their shards.
+func (c *Coordinator) waitForRejoined(ctx context.Context,
+	wave map[string]struct{}) error {
+	// hosts are not immediately reported as unavailable once restarted
+	if err := sleep(ctx, c.cfg.SettleTime); err != nil {
+		return err
+	}
+	return c.poll(ctx, func(placements []dragonboat.ShardPlacement) (uint64, bool) {
+		return checkRejoined(placements, wave)
+	})
+}
+
+func (c *Coordinator) poll(ctx context.Context,
+	check func([]dragonboat.ShardPlacement) (uint64, bool)) error {
+	tctx, cancel := context.WithTimeout(ctx, c.cfg.HealthTimeout)
+	defer cancel()
+	for {
+		placements, err := c.getPlacements()
+		if err != nil {
+			return err
+		}
+		shardID, ok := check(placements)
+		if ok {
+			return nil
+		}
+		if err := sleep(tctx, c.cfg.PollInterval); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.Wrapf(ErrUnhealthy, "shard %d", shardID)
+		}
+	}
+}
+
+func (c *Coordinator) transferLeaderships(ctx context.Context,
+	placements []dragonboat.ShardPlacement, wave map[string]struct{}) {
+	for _, p := range placements {
+		leader, ok := getLeader(p)
+		if !ok {
+			continue
+		}
+		if _, ok := wave[leader.NodeHostID]; !ok {
+			continue
+		}
+		target, ok := getTarget(p, wave)
+		if !ok {
+			plog.Warningf("no leader transfer target for shard %d", p.ShardID)
+			continue
+		}
+		t := c.getTransferer(leader.NodeHostID)
+		if t == nil {
+			plog.Warningf("no transferer for host %s", leader.NodeHostID)
+			continue
+		}
+		tctx, cancel := context.WithTimeout(ctx, c.cfg.TransferTimeout)
+		opt := dragonboat.LeaderTransferOption{}
+		err := t.SyncRequestLeaderTransfer(tctx, p.ShardID, target, opt)
+		cancel()
+		if err != nil {
+			plog.Warningf("failed to move shard %d leadership off %s, %v",
+				p.ShardID, leader.NodeHostID, err)
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func toSet(hosts []string) map[string]struct{} {
+	result := make(map[string]struct{}, len(hosts))
+	for _, nhID := range hosts {
+		result[nhID] = struct{}{}
+	}
+	return result
+}
+
+func isVoting(r dragonboat.ReplicaPlacement) bool {
+	return r.Role == dragonboat.Voter || r.Role == dragonboat.Witness
+}
+
+func isLive(r dragonboat.ReplicaPlacement) bool {
+	return r.Liveness != dragonboat.NodeHostDead &&
+		r.Liveness != dragonboat.NodeHostSuspect
+}
+
+// getTolerance returns the number of voting replicas that can be unavailable
+// without having the shard lose its quorum.
+func getTolerance(p dragonboat.ShardPlacement) int {
+	voting := 0
+	for _, r := range p.Replicas {
+		if isVoting(r) {
+			voting++
+		}
+	}
+	return voting - (voting/2 + 1)
+}
+
+func getLeader(p dragonboat.ShardPlacement) (dragonboat.ReplicaPlacement, bool) {
+	if p.LeaderID == 0 {
+		return dragonboat.ReplicaPlacement{}, false
+	}
+	for _, r := range p.Replicas {
+		if r.ReplicaID == p.LeaderID {
+			return r, true
+		}
+	}
+	return dragonboat.ReplicaPlacement{}, false
+}
+
+// getTarget returns the replica ID of a live voter not in the wave.
+func getTarget(p dragonboat.ShardPlacement,
+	wave map[string]struct{}) (uint64, bool) {
+	for _, r := range p.Replicas {
+		if _, ok := wave[r.NodeHostID]; ok {
+			continue
+		}
+		if r.Role == dragonboat.Voter && isLive(r) {
+			return r.ReplicaID, true
+		}
+	}
+	return 0, false
+}
+
+// checkHealth checks whether all shards with replicas in the wave have a
+// known leader outside the wave and a quorum of live voting replicas outside
+// the wave. The ID of the first unhealthy shard is returned when they are not
+// all healthy.
+func checkHealth(placements []dragonboat.ShardPlacement,
+	wave map[string]struct{}) (uint64, bool) {
+	for _, p := range placements {
+		if !isInvolved(p, wave) {
+			continue
+		}
+		live := 0
+		voting := 0
+		for _, r := range p.Replicas {
+			if !isVoting(r) {
+				continue
+			}
+			voting++
+			if _, ok := wave[r.NodeHostID]; !ok && isLive(r) {
+				live++
+			}
+		}
+		leader, ok := getLeader(p)
+		if !ok || !isLive(leader) || live < voting/2+1 {
+			return p.ShardID, false
+		}
+		if _, ok := wave[leader.NodeHostID]; ok {
+			return p.ShardID, false
+		}
+	}
+	return 0, true
+}
+
+// checkRejoined checks whether all shards with replicas in the wave have a
+// known leader and all their replicas in the wave are live.
+func checkRejoined(placements []dragonboat.ShardPlacement,
+	wave map[string]struct{}) (uint64, bool) {
+	for _, p := range placements {
+		if !isInvolved(p, wave) {
+			continue
+		}
+		if leader, ok := getLeader(p); !ok || !isLive(leader) {
+			return p.ShardID, false
+		}
+		for _, r := range p.Replicas {
+			if _, ok := wave[r.NodeHostID]; ok && !isLive(r) {
+				return p.ShardID, false
+			}
+		}
+	}
+	return 0, true
+}
+
+func isInvolved(p dragonboat.ShardPlacement, wave map[string]struct{}) bool {
+	for _, r := range p.Replicas {
+		if _, ok := wave[r.NodeHostID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// plan groups the specified hosts into restart waves. Hosts are placed into
+// the first wave in which every shard still retains its quorum, hosts with
+// more voting replicas are placed first.
+func plan(placements []dragonboat.ShardPlacement, hosts []string) [][]string {
+	shards := make(map[string][]int)
+	for idx, p := range placements {
+		for _, r := range p.Replicas {
+			if isVoting(r) {
+				shards[r.NodeHostID] = append(shards[r.NodeHostID], idx)
+			}
+		}
+	}
+	order := append([]string(nil), hosts...)
+	sort.SliceStable(order, func(i, j int) bool {
+		return len(shards[order[i]]) > len(shards[order[j]])
+	})
+	var waves [][]string
+	// the number of voting replicas of each shard included in each wave
+	var included []map[int]int
+	for _, nhID := range order {
+		placed := false
+		for w := range waves {
+			fits := true
+			for _, idx := range shards[nhID] {
+				if included[w][idx]+1 > getTolerance(placements[idx]) {
+					fits = false
+					break
+				}
+			}
+			if fits {
+				waves[w] = append(waves[w], nhID)
+				for _, idx := range shards[nhID] {
+					included[w][idx]++
+				}
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			// a host always gets its own wave, even when the shard can't
+			// tolerate any unavailable voting replica
+			wave := make(map[int]int)
+			for _, idx := range shards[nhID] {
+				wave[idx]++
+			}
+			waves = append(waves, []string{nhID})
+			included = append(included, wave)
+		}
+	}
+	for _, wave := range waves {
+		sort.Strings(wave)
+	}
+	return waves
+}
@@ -0,0 +1,342 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+)
+
+type simShard struct {
+	voters     map[uint64]int
+	nonVotings map[uint64]int
+	leader     uint64
+	term       uint64
+}
+
+// simFleet simulates a fleet of NodeHosts each managing many shards, hosts
+// are restarted asynchronously once the coordinator says it is safe to do so.
+type simFleet struct {
+	t         *testing.T
+	mu        sync.Mutex
+	shards    map[uint64]*simShard
+	hosts     int
+	down      map[int]struct{}
+	failed    map[int]struct{}
+	restarts  map[int]int
+	maxDown   int
+	calls     int
+	failEach  int
+	restartIn time.Duration
+	wg        sync.WaitGroup
+}
+
+func newSimFleet(t *testing.T, hosts int, shards int) *simFleet {
+	f := &simFleet{
+		t:         t,
+		shards:    make(map[uint64]*simShard),
+		hosts:     hosts,
+		down:      make(map[int]struct{}),
+		failed:    make(map[int]struct{}),
+		restarts:  make(map[int]int),
+		restartIn: 5 * time.Millisecond,
+	}
+	r := rand.New(rand.NewSource(1))
+	for shardID := uint64(1); shardID <= uint64(shards); shardID++ {
+		voters := 3
+		if shardID%4 == 0 {
+			voters = 5
+		}
+		s := &simShard{
+			voters:     make(map[uint64]int),
+			nonVotings: make(map[uint64]int),
+			term:       1,
+		}
+		placed := r.Perm(hosts)[:voters+1]
+		for idx, h := range placed[:voters] {
+			s.voters[uint64(idx+1)] = h
+		}
+		s.nonVotings[uint64(voters+1)] = placed[voters]
+		s.leader = uint64(r.Intn(voters) + 1)
+		f.shards[shardID] = s
+	}
+	return f
+}
+
+func (f *simFleet) id(h int) string {
+	return fmt.Sprintf("nh%d", h)
+}
+
+func (f *simFleet) host(nhID string) int {
+	var h int
+	if _, err := fmt.Sscanf(nhID, "nh%d", &h); err != nil {
+		f.t.Fatalf("unexpected host %s", nhID)
+	}
+	return h
+}
+
+func (f *simFleet) isDown(h int) bool {
+	_, down := f.down[h]
+	_, failed := f.failed[h]
+	return down || failed
+}
+
+func (f *simFleet) getPlacements() ([]dragonboat.ShardPlacement, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := make([]dragonboat.ShardPlacement, 0, len(f.shards))
+	for shardID, s := range f.shards {
+		p := dragonboat.ShardPlacement{
+			ShardID:  shardID,
+			LeaderID: s.leader,
+			Term:     s.term,
+		}
+		add := func(replicas map[uint64]int, role dragonboat.ReplicaRole) {
+			for replicaID, h := range replicas {
+				liveness := dragonboat.NodeHostAlive
+				if f.isDown(h) {
+					liveness = dragonboat.NodeHostDead
+				}
+				p.Replicas = append(p.Replicas, dragonboat.ReplicaPlacement{
+					ReplicaID:  replicaID,
+					NodeHostID: f.id(h),
+					Role:       role,
+					IsLeader:   replicaID == s.leader,
+					Liveness:   liveness,
+				})
+			}
+		}
+		add(s.voters, dragonboat.Voter)
+		add(s.nonVotings, dragonboat.NonVoting)
+		sort.Slice(p.Replicas, func(i, j int) bool {
+			return p.Replicas[i].ReplicaID < p.Replicas[j].ReplicaID
+		})
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ShardID < result[j].ShardID
+	})
+	return result, nil
+}
+
+func (f *simFleet) transfer(host int, shardID uint64, target uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	s := f.shards[shardID]
+	if s.voters[s.leader] != host {
+		f.t.Errorf("transfer requested on shard %d from non-leader host", shardID)
+	}
+	h, ok := s.voters[target]
+	if !ok {
+		f.t.Fatalf("unknown target %d", target)
+	}
+	if f.isDown(h) {
+		f.t.Errorf("leadership moved onto unavailable host %d", h)
+	}
+	if f.failEach > 0 && f.calls%f.failEach == 0 {
+		return dragonboat.ErrTimeout
+	}
+	s.leader = target
+	s.term++
+	return nil
+}
+
+func (f *simFleet) restart(ctx context.Context, nhID string) error {
+	h := f.host(nhID)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.isDown(h) {
+		f.t.Errorf("host %d restarted when it is unavailable", h)
+	}
+	f.down[h] = struct{}{}
+	f.restarts[h]++
+	if len(f.down) > f.maxDown {
+		f.maxDown = len(f.down)
+	}
+	for shardID, s := range f.shards {
+		if s.voters[s.leader] == h {
+			f.t.Errorf("shard %d leader on restarted host %d", shardID, h)
+		}
+		live := 0
+		for _, vh := range s.voters {
+			if !f.isDown(vh) {
+				live++
+			}
+		}
+		if live < len(s.voters)/2+1 {
+			f.t.Errorf("shard %d lost quorum", shardID)
+		}
+	}
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		time.Sleep(f.restartIn)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.down, h)
+	}()
+	return nil
+}
+
+func (f *simFleet) getTransferer(nhID string) ILeaderTransferer {
+	return &simTransferer{host: f.host(nhID), f: f}
+}
+
+type simTransferer struct {
+	host int
+	f    *simFleet
+}
+
+func (t *simTransferer) SyncRequestLeaderTransfer(ctx context.Context,
+	shardID uint64, target uint64, opt dragonboat.LeaderTransferOption) error {
+	return t.f.transfer(t.host, shardID, target)
+}
+
+func newSimCoordinator(f *simFleet, cfg Config) *Coordinator {
+	cfg.SettleTime = time.Millisecond
+	cfg.PollInterval = time.Millisecond
+	if cfg.HealthTimeout == 0 {
+		cfg.HealthTimeout = 5 * time.Second
+	}
+	return NewCoordinator(cfg, f.getPlacements, f.getTransferer, f.restart)
+}
+
+func checkWaves(t *testing.T, f *simFleet, waves [][]string) {
+	for _, wave := range waves {
+		in := make(map[int]struct{})
+		for _, nhID := range wave {
+			in[f.host(nhID)] = struct{}{}
+		}
+		for shardID, s := range f.shards {
+			restarted := 0
+			for _, h := range s.voters {
+				if _, ok := in[h]; ok {
+					restarted++
+				}
+			}
+			if len(s.voters)-restarted < len(s.voters)/2+1 {
+				t.Errorf("wave %v breaks the quorum of shard %d", wave, shardID)
+			}
+		}
+	}
+}
+
+func TestPlanKeepsQuorum(t *testing.T) {
+	f := newSimFleet(t, 6, 0)
+	// nh0-nh2 and nh3-nh5 don't share any shard, nh0 and nh1 share a 5
+	// replica shard with nh3 and nh4
+	f.shards = map[uint64]*simShard{
+		1: {voters: map[uint64]int{1: 0, 2: 1, 3: 2}, leader: 1},
+		2: {voters: map[uint64]int{1: 3, 2: 4, 3: 5}, leader: 1},
+		3: {voters: map[uint64]int{1: 0, 2: 1, 3: 3, 4: 4, 5: 5}, leader: 1},
+	}
+	waves, err := newSimCoordinator(f, Config{}).Plan()
+	if err != nil {
+		t.Fatalf("failed to plan %v", err)
+	}
+	checkWaves(t, f, waves)
+	if len(waves) != 3 {
+		t.Errorf("unexpected waves %v", waves)
+	}
+	count := 0
+	for _, wave := range waves {
+		count += len(wave)
+	}
+	if count != f.hosts {
+		t.Errorf("unexpected waves %v", waves)
+	}
+}
+
+func TestSimulatedFleetCanBeRestarted(t *testing.T) {
+	f := newSimFleet(t, 20, 60)
+	// some transfers fail, they are retried while waiting for the shards to
+	// become healthy
+	f.failEach = 5
+	c := newSimCoordinator(f, Config{})
+	waves, err := c.Plan()
+	if err != nil {
+		t.Fatalf("failed to plan %v", err)
+	}
+	checkWaves(t, f, waves)
+	if len(waves) >= f.hosts {
+		t.Errorf("no host restarted concurrently, %v", waves)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	restarted, err := c.Run(ctx)
+	if err != nil {
+		t.Fatalf("failed to run %v", err)
+	}
+	f.wg.Wait()
+	if len(restarted) != f.hosts {
+		t.Errorf("unexpected restarted hosts %v", restarted)
+	}
+	for h := 0; h < f.hosts; h++ {
+		if f.restarts[h] != 1 {
+			t.Errorf("host %d restarted %d times", h, f.restarts[h])
+		}
+	}
+	if f.maxDown < 2 {
+		t.Errorf("hosts not restarted concurrently")
+	}
+}
+
+func TestSelectedHostsAreRestarted(t *testing.T) {
+	f := newSimFleet(t, 10, 30)
+	c := newSimCoordinator(f, Config{Hosts: []string{"nh1", "nh3"}})
+	restarted, err := c.Run(context.Background())
+	if err != nil {
+		t.Fatalf("failed to run %v", err)
+	}
+	f.wg.Wait()
+	sort.Strings(restarted)
+	if len(restarted) != 2 || restarted[0] != "nh1" || restarted[1] != "nh3" {
+		t.Errorf("unexpected restarted hosts %v", restarted)
+	}
+	c = newSimCoordinator(f, Config{Hosts: []string{"nh100"}})
+	if _, err := c.Run(context.Background()); !errors.Is(err, ErrUnknownHost) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestUnhealthyShardStopsRollout(t *testing.T) {
+	f := newSimFleet(t, 4, 0)
+	f.shards = map[uint64]*simShard{
+		1: {voters: map[uint64]int{1: 0, 2: 1, 3: 2}, leader: 1},
+	}
+	// nh2 failed, restarting nh0 or nh1 would break the quorum of shard 1
+	f.failed[2] = struct{}{}
+	c := newSimCoordinator(f, Config{
+		Hosts:         []string{"nh0", "nh1"},
+		HealthTimeout: 50 * time.Millisecond,
+	})
+	restarted, err := c.Run(context.Background())
+	if !errors.Is(err, ErrUnhealthy) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(restarted) != 0 || len(f.restarts) != 0 {
+		t.Errorf("unexpected restarted hosts %v", restarted)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/importer"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+var (
+	// ErrInvalidSnapshotMetadata indicates that the metadata file of the
+	// exported snapshot is corrupted or invalid.
+	ErrInvalidSnapshotMetadata = errors.New("invalid snapshot metadata")
+	// ErrSnapshotFileMissing indicates that a file referenced by the exported
+	// snapshot can not be found.
+	ErrSnapshotFileMissing = rsm.ErrSnapshotFileMissing
+	// ErrSnapshotFileSize indicates that the size of a file of the exported
+	// snapshot is different from the size recorded in its metadata.
+	ErrSnapshotFileSize = rsm.ErrSnapshotFileSize
+	// ErrSnapshotChecksum indicates that a file of the exported snapshot failed
+	// the checksum check.
+	ErrSnapshotChecksum = rsm.ErrSnapshotChecksum
+)
+
+// VerifyOption is the option type used by VerifySnapshotWithOption.
+type VerifyOption struct {
+	// Deep indicates whether the full content of all files should be re-hashed
+	// and checked against their checksums. When Deep is false, only file sizes,
+	// the snapshot image header, tail and the payload checksum derived from
+	// block checksums are checked.
+	Deep bool
+}
+
+// VerifiedFile describes a file of the exported snapshot verified by
+// VerifySnapshot.
+type VerifiedFile struct {
+	// Filepath is the path of the file.
+	Filepath string
+	// FileSize is the size of the file in bytes.
+	FileSize uint64
+	// FileID is the ID assigned by the state machine to the external file.
+	FileID uint64
+	// External indicates whether the file is an external file added to the
+	// ISnapshotFileCollection by the state machine.
+	External bool
+	// ChecksumVerified indicates whether the full content of the file has been
+	// re-hashed and checked against its checksum.
+	ChecksumVerified bool
+}
+
+// SnapshotManifest describes the exported snapshot verified by
+// VerifySnapshot.
+type SnapshotManifest struct {
+	ShardID     uint64
+	Index       uint64
+	Term        uint64
+	OnDiskIndex uint64
+	Type        pb.StateMachineType
+	// Deep indicates whether the snapshot has been verified with the Deep
+	// option.
+	Deep bool
+	// Files are the verified files, the snapshot image is always the first one.
+	Files []VerifiedFile
+}
+
+// VerifySnapshot checks the integrity of the exported snapshot in the
+// specified directory without re-hashing the full content of its files. The
+// metadata file, the sizes of all files referenced by the metadata, the
+// snapshot image header, the payload length and the payload checksum are
+// checked. A manifest describing the verified snapshot is returned.
+//
+// VerifySnapshot is typically used to check exported snapshots copied between
+// storage systems before they are imported using ImportSnapshot.
+func VerifySnapshot(dir string) (SnapshotManifest, error) {
+	return VerifySnapshotWithOption(dir, VerifyOption{})
+}
+
+// VerifySnapshotWithOption checks the integrity of the exported snapshot in the
+// specified directory as specified by opt. See VerifySnapshot for details.
+func VerifySnapshotWithOption(dir string,
+	opt VerifyOption) (SnapshotManifest, error) {
+	return verifySnapshot(dir, opt, vfs.DefaultFS)
+}
+
+func verifySnapshot(dir string,
+	opt VerifyOption, fs vfs.IFS) (SnapshotManifest, error) {
+	exist, err := fileutil.Exist(dir, fs)
+	if err != nil {
+		return SnapshotManifest{}, err
+	}
+	if !exist {
+		return SnapshotManifest{}, ErrPathNotExist
+	}
+	ss, err := getVerifiedSnapshotRecord(dir, fs)
+	if err != nil {
+		return SnapshotManifest{}, err
+	}
+	m := SnapshotManifest{
+		ShardID:     ss.ShardID,
+		Index:       ss.Index,
+		Term:        ss.Term,
+		OnDiskIndex: ss.OnDiskIndex,
+		Type:        ss.Type,
+		Deep:        opt.Deep,
+	}
+	fp := fs.PathJoin(dir, fs.PathBase(ss.Filepath))
+	if err := rsm.VerifySnapshotImage(fp,
+		ss.FileSize, ss.Checksum, opt.Deep, fs); err != nil {
+		return SnapshotManifest{}, err
+	}
+	m.Files = append(m.Files, VerifiedFile{
+		Filepath:         fp,
+		FileSize:         ss.FileSize,
+		ChecksumVerified: opt.Deep,
+	})
+	for _, f := range ss.Files {
+		fp := fs.PathJoin(dir, fs.PathBase(f.Filepath))
+		if err := rsm.VerifySnapshotFile(fp, f, opt.Deep, fs); err != nil {
+			return SnapshotManifest{}, err
+		}
+		m.Files = append(m.Files, VerifiedFile{
+			Filepath:         fp,
+			FileSize:         f.FileSize,
+			FileID:           f.FileId,
+			External:         true,
+			ChecksumVerified: opt.Deep && len(f.Checksum) > 0,
+		})
+	}
+	return m, nil
+}
+
+func getVerifiedSnapshotRecord(dir string, fs vfs.IFS) (pb.Snapshot, error) {
+	fp := fs.PathJoin(dir, server.MetadataFilename)
+	if _, err := fs.Stat(fp); vfs.IsNotExist(err) {
+		return pb.Snapshot{}, errors.Wrapf(ErrSnapshotFileMissing, "%s", fp)
+	}
+	ss, err := importer.GetSnapshotRecord(importer.NewDirSource(dir, fs))
+	if err != nil {
+		if errors.Is(err, fileutil.ErrCorruptedFlagFile) {
+			return pb.Snapshot{}, errors.Wrapf(ErrInvalidSnapshotMetadata,
+				"%s, %v", fp, err)
+		}
+		return pb.Snapshot{}, err
+	}
+	if ss.Index == 0 || len(ss.Filepath) == 0 || ss.FileSize == 0 {
+		return pb.Snapshot{}, errors.Wrapf(ErrInvalidSnapshotMetadata,
+			"%s, index %d, filepath %s, file size %d",
+			fp, ss.Index, ss.Filepath, ss.FileSize)
+	}
+	return ss, nil
+}
@@ -0,0 +1,270 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	testImageFilename    = "snapshot-0000000000000064.gbsnap"
+	testExternalFilename = "external-file-1"
+)
+
+func writeTestFile(t *testing.T, fp string, data []byte, fs vfs.IFS) {
+	f, err := fs.Create(fp)
+	if err != nil {
+		t.Fatalf("failed to create file %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("failed to write %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close %v", err)
+	}
+}
+
+func readTestFile(t *testing.T, fp string, fs vfs.IFS) []byte {
+	f, err := fs.Open(fp)
+	if err != nil {
+		t.Fatalf("failed to open file %v", err)
+	}
+	defer f.Close()
+	data, err := fileutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("failed to read %v", err)
+	}
+	return data
+}
+
+// createTestExportedSnapshot creates an exported snapshot of an on disk state
+// machine with one external file.
+func createTestExportedSnapshot(t *testing.T, fs vfs.IFS) {
+	if err := fs.RemoveAll(testDataDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := fs.MkdirAll(testDataDir, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	fp := fs.PathJoin(testDataDir, testImageFilename)
+	w, err := rsm.NewSnapshotWriter(fp, pb.NoCompression, fs)
+	if err != nil {
+		t.Fatalf("failed to create writer %v", err)
+	}
+	data := make([]byte, 1024*1024)
+	_, _ = rand.Read(data)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("failed to write %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close %v", err)
+	}
+	fi, err := fs.Stat(fp)
+	if err != nil {
+		t.Fatalf("failed to stat %v", err)
+	}
+	efp := fs.PathJoin(testDataDir, testExternalFilename)
+	writeTestFile(t, efp, []byte("external-file-data"), fs)
+	checksum, err := rsm.GetFileChecksum(efp, fs)
+	if err != nil {
+		t.Fatalf("failed to get checksum %v", err)
+	}
+	ss := pb.Snapshot{
+		ShardID:  1,
+		Index:    100,
+		Term:     2,
+		Filepath: fs.PathJoin("/exported", testImageFilename),
+		FileSize: uint64(fi.Size()),
+		Checksum: w.GetPayloadChecksum(),
+		Type:     pb.OnDiskStateMachine,
+		Files: []*pb.SnapshotFile{
+			{
+				Filepath: fs.PathJoin("/exported", testExternalFilename),
+				FileSize: 18,
+				FileId:   1,
+				Checksum: checksum,
+			},
+		},
+	}
+	if err := fileutil.CreateFlagFile(testDataDir,
+		server.MetadataFilename, &ss, fs); err != nil {
+		t.Fatalf("failed to create metadata %v", err)
+	}
+}
+
+func corruptTestFile(t *testing.T, name string, offset int, fs vfs.IFS) {
+	fp := fs.PathJoin(testDataDir, name)
+	data := readTestFile(t, fp, fs)
+	if offset < 0 {
+		offset = len(data) + offset
+	}
+	data[offset] = data[offset] + 1
+	writeTestFile(t, fp, data, fs)
+}
+
+func TestVerifySnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer func() {
+		if err := fs.RemoveAll(testDataDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	createTestExportedSnapshot(t, fs)
+	for _, deep := range []bool{false, true} {
+		m, err := verifySnapshot(testDataDir, VerifyOption{Deep: deep}, fs)
+		if err != nil {
+			t.Fatalf("failed to verify %v", err)
+		}
+		if m.ShardID != 1 || m.Index != 100 || m.Term != 2 ||
+			m.Type != pb.OnDiskStateMachine || m.Deep != deep {
+			t.Errorf("unexpected manifest %+v", m)
+		}
+		if len(m.Files) != 2 {
+			t.Fatalf("unexpected files %+v", m.Files)
+		}
+		if m.Files[0].External || !m.Files[1].External ||
+			m.Files[1].FileID != 1 || m.Files[1].FileSize != 18 {
+			t.Errorf("unexpected files %+v", m.Files)
+		}
+		if m.Files[0].ChecksumVerified != deep ||
+			m.Files[1].ChecksumVerified != deep {
+			t.Errorf("unexpected files %+v", m.Files)
+		}
+	}
+	if _, err := VerifySnapshot("not_exist_safe_to_delete"); err != ErrPathNotExist {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestVerifySnapshotDetectsCorruptedFiles(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer func() {
+		if err := fs.RemoveAll(testDataDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	tests := []struct {
+		name    string
+		corrupt func()
+		shallow error
+		deep    error
+	}{
+		{
+			"corrupted metadata",
+			func() { corruptTestFile(t, server.MetadataFilename, -1, fs) },
+			ErrInvalidSnapshotMetadata,
+			ErrInvalidSnapshotMetadata,
+		},
+		{
+			"missing metadata",
+			func() {
+				fp := fs.PathJoin(testDataDir, server.MetadataFilename)
+				if err := fs.RemoveAll(fp); err != nil {
+					t.Fatalf("%v", err)
+				}
+			},
+			ErrSnapshotFileMissing,
+			ErrSnapshotFileMissing,
+		},
+		{
+			"corrupted image header",
+			func() { corruptTestFile(t, testImageFilename, 10, fs) },
+			ErrSnapshotChecksum,
+			ErrSnapshotChecksum,
+		},
+		{
+			"corrupted image payload",
+			func() {
+				corruptTestFile(t, testImageFilename, int(rsm.HeaderSize)+100, fs)
+			},
+			nil,
+			ErrSnapshotChecksum,
+		},
+		{
+			"corrupted image payload length",
+			func() { corruptTestFile(t, testImageFilename, -16, fs) },
+			ErrSnapshotFileSize,
+			ErrSnapshotFileSize,
+		},
+		{
+			"truncated image",
+			func() {
+				fp := fs.PathJoin(testDataDir, testImageFilename)
+				data := readTestFile(t, fp, fs)
+				writeTestFile(t, fp, data[:len(data)-1], fs)
+			},
+			ErrSnapshotFileSize,
+			ErrSnapshotFileSize,
+		},
+		{
+			"missing image",
+			func() {
+				fp := fs.PathJoin(testDataDir, testImageFilename)
+				if err := fs.RemoveAll(fp); err != nil {
+					t.Fatalf("%v", err)
+				}
+			},
+			ErrSnapshotFileMissing,
+			ErrSnapshotFileMissing,
+		},
+		{
+			"corrupted external file",
+			func() { corruptTestFile(t, testExternalFilename, 0, fs) },
+			nil,
+			ErrSnapshotChecksum,
+		},
+		{
+			"truncated external file",
+			func() {
+				fp := fs.PathJoin(testDataDir, testExternalFilename)
+				writeTestFile(t, fp, []byte("external"), fs)
+			},
+			ErrSnapshotFileSize,
+			ErrSnapshotFileSize,
+		},
+		{
+			"missing external file",
+			func() {
+				fp := fs.PathJoin(testDataDir, testExternalFilename)
+				if err := fs.RemoveAll(fp); err != nil {
+					t.Fatalf("%v", err)
+				}
+			},
+			ErrSnapshotFileMissing,
+			ErrSnapshotFileMissing,
+		},
+	}
+	for _, tt := range tests {
+		createTestExportedSnapshot(t, fs)
+		tt.corrupt()
+		_, err := verifySnapshot(testDataDir, VerifyOption{}, fs)
+		if !errors.Is(err, tt.shallow) {
+			t.Errorf("%s, unexpected error %v, want %v", tt.name, err, tt.shallow)
+		}
+		_, err = verifySnapshot(testDataDir, VerifyOption{Deep: true}, fs)
+		if !errors.Is(err, tt.deep) {
+			t.Errorf("%s, unexpected deep error %v, want %v", tt.name, err, tt.deep)
+		}
+	}
+}
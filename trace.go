@@ -0,0 +1,168 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/lni/goutils/random"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/config"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	"github.com/lni/dragonboat/v4/tracing"
+)
+
+const (
+	tracerName         = "github.com/lni/dragonboat/v4"
+	proposeSpanName    = "dragonboat.propose"
+	readSpanName       = "dragonboat.read"
+	traceSampleScale   = 1000000
+	enqueuedEventName  = "enqueued"
+	appendedEventName  = "appended"
+	committedEventName = "committed"
+	appliedEventName   = "applied"
+	requestedEventName = "read_index_requested"
+	confirmedEventName = "read_index_confirmed"
+	completedEventName = "completed"
+)
+
+// nodeTracer creates spans for sampled proposals and linearizable reads of a
+// shard. Spans are tracked by the RequestState instances of those requests,
+// they are ended when the requests are completed.
+type nodeTracer struct {
+	tracer    tracing.Tracer
+	threshold uint64
+	shardID   uint64
+	replicaID uint64
+	// number of traced requests not completed yet
+	inflight int64
+}
+
+// newNodeTracer returns the tracer of the specified shard, nil is returned when
+// tracing is not enabled for the shard.
+func newNodeTracer(tp tracing.TracerProvider, cfg config.Config) *nodeTracer {
+	if tp == nil || cfg.TraceSampleRatio <= 0 {
+		return nil
+	}
+	return &nodeTracer{
+		tracer:    tp.Tracer(tracerName),
+		threshold: uint64(cfg.TraceSampleRatio * traceSampleScale),
+		shardID:   cfg.ShardID,
+		replicaID: cfg.ReplicaID,
+	}
+}
+
+// active returns a boolean value indicating whether there is any traced
+// request not completed yet.
+func (t *nodeTracer) active() bool {
+	return t != nil && atomic.LoadInt64(&t.inflight) > 0
+}
+
+func (t *nodeTracer) sampled() bool {
+	return t.threshold >= traceSampleScale ||
+		random.LockGuardedRand.Uint64()%traceSampleScale < t.threshold
+}
+
+// startProposal returns the span of a new proposal, nil is returned when the
+// proposal is not sampled.
+func (t *nodeTracer) startProposal(ctx context.Context,
+	session *client.Session) *requestSpan {
+	if t == nil || !t.sampled() {
+		return nil
+	}
+	return t.start(ctx, proposeSpanName,
+		tracing.Uint64("dragonboat.client_id", session.ClientID),
+		tracing.Uint64("dragonboat.series_id", session.SeriesID))
+}
+
+// startRead returns the span of a new linearizable read, nil is returned when
+// the read is not sampled.
+func (t *nodeTracer) startRead(ctx context.Context) *requestSpan {
+	if t == nil || !t.sampled() {
+		return nil
+	}
+	return t.start(ctx, readSpanName)
+}
+
+func (t *nodeTracer) start(ctx context.Context,
+	name string, attrs ...tracing.Attribute) *requestSpan {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	attrs = append(attrs,
+		tracing.Uint64("dragonboat.shard_id", t.shardID),
+		tracing.Uint64("dragonboat.replica_id", t.replicaID))
+	_, span := t.tracer.Start(ctx, name, attrs...)
+	atomic.AddInt64(&t.inflight, 1)
+	s := &requestSpan{span: span, t: t}
+	s.event(enqueuedEventName)
+	return s
+}
+
+// requestSpan is the span of a single request. All methods can be invoked on a
+// nil requestSpan.
+type requestSpan struct {
+	span tracing.Span
+	t    *nodeTracer
+}
+
+func (s *requestSpan) event(name string, attrs ...tracing.Attribute) {
+	if s != nil {
+		s.span.AddEvent(name, attrs...)
+	}
+}
+
+func (s *requestSpan) indexEvent(name string, index uint64) {
+	if s != nil {
+		s.span.AddEvent(name, tracing.Uint64("dragonboat.index", index))
+	}
+}
+
+func (s *requestSpan) entryEvent(name string, e pb.Entry) {
+	if s != nil {
+		s.span.AddEvent(name,
+			tracing.Uint64("dragonboat.index", e.Index),
+			tracing.Uint64("dragonboat.term", e.Term))
+	}
+}
+
+func (s *requestSpan) end(result string) {
+	if s != nil {
+		s.span.AddEvent(completedEventName,
+			tracing.String("dragonboat.result", result))
+		s.span.End()
+		atomic.AddInt64(&s.t.inflight, -1)
+	}
+}
+
+// traceRaftUpdate adds the appended and committed events to the spans of
+// traced proposals.
+func (n *node) traceRaftUpdate(ud pb.Update) {
+	if !n.tracer.active() {
+		return
+	}
+	for _, e := range ud.EntriesToSave {
+		if e.IsProposal() {
+			n.pendingProposals.traceEvent(appendedEventName, e)
+		}
+	}
+	for _, e := range ud.CommittedEntries {
+		if e.IsProposal() {
+			n.pendingProposals.traceEvent(committedEventName, e)
+		}
+	}
+}
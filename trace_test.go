@@ -0,0 +1,147 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/tracing/adapters"
+)
+
+func getEventNames(s adapters.RecordedSpan) []string {
+	result := make([]string, 0)
+	for _, e := range s.Events {
+		result = append(result, e.Name)
+	}
+	return result
+}
+
+func TestProposalAndReadSpansAreRecorded(t *testing.T) {
+	fs := vfs.GetTestFS()
+	recorder := adapters.NewRecorder()
+	to := &testOption{
+		defaultTestNode: true,
+		updateNodeHostConfig: func(nhc *config.NodeHostConfig) *config.NodeHostConfig {
+			nhc.TracerProvider = recorder
+			return nhc
+		},
+		updateConfig: func(c *config.Config) *config.Config {
+			c.TraceSampleRatio = 1
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			ctx, root := recorder.Tracer("app").Start(ctx, "request")
+			session := nh.GetNoOPSession(1)
+			if _, err := nh.SyncPropose(ctx, session, []byte("test-data")); err != nil {
+				t.Fatalf("failed to make proposal, %v", err)
+			}
+			if _, err := nh.SyncRead(ctx, 1, nil); err != nil {
+				t.Fatalf("failed to read, %v", err)
+			}
+			root.End()
+			// spans are ended before the results are delivered to the client, the
+			// recorder might not have them yet
+			var spans []adapters.RecordedSpan
+			for i := 0; i < 100; i++ {
+				if spans = recorder.Spans(); len(spans) == 3 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if len(spans) != 3 {
+				t.Fatalf("unexpected spans %+v", spans)
+			}
+			var rootSpan adapters.RecordedSpan
+			children := make(map[string]adapters.RecordedSpan)
+			for _, s := range spans {
+				if s.Name == "request" {
+					rootSpan = s
+				} else {
+					children[s.Name] = s
+				}
+			}
+			propose, ok := children[proposeSpanName]
+			if !ok || propose.ParentID != rootSpan.ID || rootSpan.ID == 0 {
+				t.Fatalf("unexpected propose span %+v", propose)
+			}
+			expected := []string{enqueuedEventName, appendedEventName,
+				committedEventName, appliedEventName, completedEventName}
+			if names := getEventNames(propose); !reflect.DeepEqual(names, expected) {
+				t.Errorf("unexpected events %v", names)
+			}
+			if propose.Attributes["dragonboat.shard_id"] != uint64(1) ||
+				propose.Attributes["dragonboat.replica_id"] != uint64(1) ||
+				propose.Attributes["dragonboat.client_id"] != session.ClientID {
+				t.Errorf("unexpected attributes %v", propose.Attributes)
+			}
+			index := propose.Events[1].Attributes["dragonboat.index"]
+			if index == nil || index != propose.Events[3].Attributes["dragonboat.index"] {
+				t.Errorf("unexpected index %v", propose.Events)
+			}
+			if result := propose.Events[4].Attributes["dragonboat.result"]; result !=
+				requestCompleted.String() {
+				t.Errorf("unexpected result %v", result)
+			}
+			read, ok := children[readSpanName]
+			if !ok || read.ParentID != rootSpan.ID {
+				t.Fatalf("unexpected read span %+v", read)
+			}
+			expected = []string{enqueuedEventName, requestedEventName,
+				confirmedEventName, completedEventName}
+			if names := getEventNames(read); !reflect.DeepEqual(names, expected) {
+				t.Errorf("unexpected events %v", names)
+			}
+			n, ok := nh.getShard(1)
+			if !ok {
+				t.Fatalf("failed to get node")
+			}
+			if n.tracer.active() {
+				t.Errorf("traced requests still tracked")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestTraceSampleRatioIsHonored(t *testing.T) {
+	recorder := adapters.NewRecorder()
+	if newNodeTracer(recorder, config.Config{}) != nil {
+		t.Errorf("tracing unexpectedly enabled")
+	}
+	if newNodeTracer(nil, config.Config{TraceSampleRatio: 1}) != nil {
+		t.Errorf("tracing unexpectedly enabled")
+	}
+	tracer := newNodeTracer(recorder, config.Config{TraceSampleRatio: 0.1})
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		if s := tracer.startRead(context.Background()); s != nil {
+			s.end(requestCompleted.String())
+			sampled++
+		}
+	}
+	if sampled < 500 || sampled > 1500 {
+		t.Errorf("unexpected sampled count %d", sampled)
+	}
+	if len(recorder.Spans()) != sampled {
+		t.Errorf("unexpected span count")
+	}
+}
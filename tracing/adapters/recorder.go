@@ -0,0 +1,178 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package adapters provides tracing.TracerProvider implementations.
+
+Recorder is an in-memory exporter that keeps all ended spans, it is typically
+used in tests and for debugging. Adapting an OpenTelemetry TracerProvider only
+requires forwarding the calls, e.g. the Start method of the Tracer adapter is
+expected to look like
+
+	func (t *otelTracer) Start(ctx context.Context, name string,
+		attrs ...tracing.Attribute) (context.Context, tracing.Span) {
+		ctx, span := t.tracer.Start(ctx, name,
+			trace.WithAttributes(toKeyValues(attrs)...))
+		return ctx, &otelSpan{span: span}
+	}
+*/
+package adapters
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lni/dragonboat/v4/tracing"
+)
+
+// RecordedEvent is an event recorded by the Recorder.
+type RecordedEvent struct {
+	Name       string
+	Time       time.Time
+	Attributes map[string]interface{}
+}
+
+// RecordedSpan is a span recorded by the Recorder.
+type RecordedSpan struct {
+	// ID is the identifier of the span, it is unique within the Recorder.
+	ID uint64
+	// ParentID is the ID of the parent span, it is 0 for root spans.
+	ParentID uint64
+	// Tracer is the instrumentation name of the tracer used for creating the
+	// span.
+	Tracer     string
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Events     []RecordedEvent
+}
+
+// Recorder is a tracing.TracerProvider that records all ended spans in memory.
+type Recorder struct {
+	mu     sync.Mutex
+	spans  []RecordedSpan
+	nextID uint64
+}
+
+var _ tracing.TracerProvider = (*Recorder)(nil)
+
+// NewRecorder returns a new Recorder instance.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Tracer returns a tracing.Tracer that records spans to the Recorder.
+func (r *Recorder) Tracer(name string) tracing.Tracer {
+	return &recordingTracer{name: name, r: r}
+}
+
+// Spans returns all ended spans sorted by their IDs.
+func (r *Recorder) Spans() []RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make([]RecordedSpan, len(r.spans))
+	copy(result, r.spans)
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+func (r *Recorder) newID() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	return r.nextID
+}
+
+func (r *Recorder) ended(s RecordedSpan) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+type spanKey struct{}
+
+type recordingTracer struct {
+	r    *Recorder
+	name string
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string,
+	attrs ...tracing.Attribute) (context.Context, tracing.Span) {
+	s := &recordingSpan{
+		r: t.r,
+		span: RecordedSpan{
+			ID:         t.r.newID(),
+			Tracer:     t.name,
+			Name:       name,
+			Start:      time.Now(),
+			Attributes: make(map[string]interface{}),
+		},
+	}
+	if parent, ok := ctx.Value(spanKey{}).(*recordingSpan); ok {
+		s.span.ParentID = parent.span.ID
+	}
+	s.SetAttributes(attrs...)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+type recordingSpan struct {
+	r     *Recorder
+	mu    sync.Mutex
+	span  RecordedSpan
+	ended bool
+}
+
+func (s *recordingSpan) AddEvent(name string, attrs ...tracing.Attribute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	e := RecordedEvent{
+		Name:       name,
+		Time:       time.Now(),
+		Attributes: make(map[string]interface{}),
+	}
+	for _, a := range attrs {
+		e.Attributes[a.Key] = a.Value
+	}
+	s.span.Events = append(s.span.Events, e)
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...tracing.Attribute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	for _, a := range attrs {
+		s.span.Attributes[a.Key] = a.Value
+	}
+}
+
+func (s *recordingSpan) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.span.End = time.Now()
+	span := s.span
+	s.mu.Unlock()
+	s.r.ended(span)
+}
@@ -0,0 +1,81 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package tracing defines the minimal tracing interfaces used by Dragonboat to
+report the lifecycle of proposals and linearizable reads.
+
+The interfaces are modeled after the OpenTelemetry tracing API so tracers such
+as the OpenTelemetry SDK can be plugged in with a thin adapter without making
+Dragonboat depend on them. Set NodeHostConfig.TracerProvider to enable tracing
+and use Config.TraceSampleRatio to control the sampling of each shard.
+*/
+package tracing
+
+import (
+	"context"
+)
+
+// Attribute is a key value pair attached to spans and span events. Value is
+// of either the string, int64, uint64 or bool type.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string Attribute.
+func String(key string, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int64 returns an int64 Attribute.
+func Int64(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Uint64 returns an uint64 Attribute.
+func Uint64(key string, value uint64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Bool returns a bool Attribute.
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Span is the interface of a span, it represents a single proposal or a single
+// linearizable read. All Span methods are required to be concurrency safe.
+type Span interface {
+	// AddEvent adds an event with the specified attributes to the span.
+	AddEvent(name string, attrs ...Attribute)
+	// SetAttributes sets the specified attributes on the span.
+	SetAttributes(attrs ...Attribute)
+	// End completes the span. No further event or attribute is added to the
+	// span after End is called.
+	End()
+}
+
+// Tracer is the interface used for creating spans.
+type Tracer interface {
+	// Start creates a span. The span is expected to be a child of the span
+	// carried by the specified context, if any.
+	Start(ctx context.Context, name string,
+		attrs ...Attribute) (context.Context, Span)
+}
+
+// TracerProvider is the interface used for getting Tracer instances.
+type TracerProvider interface {
+	// Tracer returns the Tracer with the specified instrumentation name.
+	Tracer(name string) Tracer
+}
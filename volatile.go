@@ -0,0 +1,141 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/logdb"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	volatileLogDBDir = "volatile"
+)
+
+// volatileLogDB is the memory backed LogDB used by replicas in the Volatile
+// storage class. Bootstrap info is kept in the durable LogDB so the replica ID
+// of such replicas is preserved across restarts, everything else is stored in
+// memory and lost when the NodeHost is closed.
+type volatileLogDB struct {
+	raftio.ILogDB
+	durable raftio.ILogDB
+	mu      sync.Mutex
+	// replicas contains replicas with their Raft log kept in the instance
+	replicas map[raftio.NodeInfo]struct{}
+}
+
+var _ raftio.ILogDB = (*volatileLogDB)(nil)
+
+func newVolatileLogDB(nhConfig config.NodeHostConfig,
+	durable raftio.ILogDB) (*volatileLogDB, error) {
+	// the memory backed LogDB only holds small shards, it uses a single shard
+	// with the minimum memory footprint
+	nhConfig.Expert.FS = vfs.NewMemFS()
+	nhConfig.Expert.LogDB = config.GetTinyMemLogDBConfig()
+	nhConfig.Expert.LogDB.Shards = 1
+	cb := func(config.LogDBInfo) {}
+	ldb, err := logdb.NewDefaultLogDB(nhConfig,
+		cb, []string{volatileLogDBDir}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &volatileLogDB{
+		ILogDB:   ldb,
+		durable:  durable,
+		replicas: make(map[raftio.NodeInfo]struct{}),
+	}, nil
+}
+
+// SaveBootstrapInfo saves the bootstrap info to the durable LogDB.
+func (v *volatileLogDB) SaveBootstrapInfo(shardID uint64,
+	replicaID uint64, bootstrap pb.Bootstrap) error {
+	return v.durable.SaveBootstrapInfo(shardID, replicaID, bootstrap)
+}
+
+// GetBootstrapInfo returns the bootstrap info saved in the durable LogDB.
+func (v *volatileLogDB) GetBootstrapInfo(shardID uint64,
+	replicaID uint64) (pb.Bootstrap, error) {
+	return v.durable.GetBootstrapInfo(shardID, replicaID)
+}
+
+// RemoveNodeData removes the Raft log of the specified replica, its bootstrap
+// info in the durable LogDB is not touched.
+func (v *volatileLogDB) RemoveNodeData(shardID uint64, replicaID uint64) error {
+	v.mu.Lock()
+	delete(v.replicas, raftio.GetNodeInfo(shardID, replicaID))
+	v.mu.Unlock()
+	return v.ILogDB.RemoveNodeData(shardID, replicaID)
+}
+
+// hasLog returns a boolean value indicating whether the Raft log of the
+// specified replica is kept in the instance. It returns false for replicas
+// bootstrapped before the NodeHost was restarted.
+func (v *volatileLogDB) hasLog(shardID uint64, replicaID uint64) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	_, ok := v.replicas[raftio.GetNodeInfo(shardID, replicaID)]
+	return ok
+}
+
+func (v *volatileLogDB) addReplica(shardID uint64, replicaID uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.replicas[raftio.GetNodeInfo(shardID, replicaID)] = struct{}{}
+}
+
+// getVolatileLogDB returns the memory backed LogDB, it is created when it is
+// required for the first time. nh.mu must be held by the caller.
+func (nh *NodeHost) getVolatileLogDB() (*volatileLogDB, error) {
+	if nh.mu.volatile == nil {
+		vdb, err := newVolatileLogDB(nh.nhConfig, nh.mu.logdb)
+		if err != nil {
+			return nil, err
+		}
+		nh.mu.volatile = vdb
+	}
+	return nh.mu.volatile, nil
+}
+
+// saveRaftState saves the updates to the LogDB of their storage classes.
+func (e *engine) saveRaftState(updates []pb.Update,
+	nodes map[uint64]*node, workerID uint64) error {
+	var vdb raftio.ILogDB
+	for _, ud := range updates {
+		if n := nodes[ud.ShardID]; n.config.StorageClass == config.Volatile {
+			vdb = n.logdb
+			break
+		}
+	}
+	if vdb == nil {
+		return e.logdb.SaveRaftState(updates, workerID)
+	}
+	durable := make([]pb.Update, 0, len(updates))
+	volatile := make([]pb.Update, 0, len(updates))
+	for _, ud := range updates {
+		if nodes[ud.ShardID].config.StorageClass == config.Volatile {
+			volatile = append(volatile, ud)
+		} else {
+			durable = append(durable, ud)
+		}
+	}
+	if err := vdb.SaveRaftState(volatile, workerID); err != nil {
+		return err
+	}
+	return e.logdb.SaveRaftState(durable, workerID)
+}
@@ -0,0 +1,191 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/tests"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+	"github.com/lni/dragonboat/v4/raftio"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func getVolatileTestConfig(shardID uint64,
+	replicaID uint64, class config.StorageClass) config.Config {
+	cfg := getBootstrapTestConfig(replicaID)
+	cfg.ShardID = shardID
+	cfg.StorageClass = class
+	return cfg
+}
+
+func waitForStaleValue(t *testing.T,
+	nh *NodeHost, shardID uint64, key string, expected string) {
+	for i := 0; i < 1000; i++ {
+		v, err := nh.StaleRead(shardID, key)
+		if err == nil && v.(string) == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("shard %d failed to have %s=%s", shardID, key, expected)
+}
+
+func TestVolatileReplicaRecoversFromPeersAfterRestart(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := make(map[uint64]Target)
+		for i := range nhs {
+			members[uint64(i+1)] = memtransport.Address(i + 1)
+		}
+		// shard 1 is volatile while shard 2 on the same NodeHosts is durable
+		start := func(idx int) {
+			for shardID, class := range map[uint64]config.StorageClass{
+				1: config.Volatile,
+				2: config.Durable,
+			} {
+				cfg := getVolatileTestConfig(shardID, uint64(idx+1), class)
+				if err := nhs[idx].StartReplica(members,
+					false, newCloneTestSM, cfg); err != nil {
+					t.Fatalf("failed to start replica %v", err)
+				}
+			}
+		}
+		propose := func(shardID uint64, cmd string) {
+			ctx, cancel := context.WithTimeout(context.Background(), lpto(nhs[0]))
+			defer cancel()
+			if _, err := nhs[0].SyncPropose(ctx,
+				nhs[0].GetNoOPSession(shardID), []byte(cmd)); err != nil {
+				t.Fatalf("failed to propose %v", err)
+			}
+		}
+		for i := range nhs {
+			start(i)
+		}
+		for _, nh := range nhs {
+			waitForLeaderToBeElected(t, nh, 1)
+			waitForLeaderToBeElected(t, nh, 2)
+		}
+		for i := 0; i < 10; i++ {
+			propose(1, fmt.Sprintf("k%d=%d", i, i))
+		}
+		propose(2, "a=1")
+		nhc := nhs[2].NodeHostConfig()
+		nhs[2].Close()
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			t.Fatalf("failed to create nodehost %v", err)
+		}
+		nhs[2] = nh
+		// nothing but the bootstrap info of the volatile replica was persisted
+		if _, err := nh.mu.logdb.GetBootstrapInfo(1, 3); err != nil {
+			t.Fatalf("failed to get bootstrap info %v", err)
+		}
+		if _, err := nh.mu.logdb.ReadRaftState(1,
+			3, 0); !errors.Is(err, raftio.ErrNoSavedLog) {
+			t.Fatalf("unexpected raft state, %v", err)
+		}
+		if _, err := nh.mu.logdb.ReadRaftState(2, 3, 0); err != nil {
+			t.Fatalf("durable raft state not found, %v", err)
+		}
+		start(2)
+		waitForStaleValue(t, nh, 1, "k9", "9")
+		waitForStaleValue(t, nh, 2, "a", "1")
+		if n, ok := nh.getShard(1); !ok || n.replicaID != 3 {
+			t.Fatalf("replica ID not preserved")
+		}
+		propose(1, "k10=10")
+		for _, nh := range nhs {
+			for i := 0; i <= 10; i++ {
+				waitForStaleValue(t, nh, 1, fmt.Sprintf("k%d", i), fmt.Sprint(i))
+			}
+		}
+		// the raft log is kept in memory when the replica is restarted without
+		// closing the NodeHost
+		if err := nh.StopShard(1); err != nil {
+			t.Fatalf("failed to stop shard %v", err)
+		}
+		if !nh.mu.volatile.hasLog(1, 3) {
+			t.Errorf("raft log unexpectedly lost")
+		}
+		begin := time.Now()
+		for {
+			err := nh.StartReplica(members,
+				false, newCloneTestSM, getVolatileTestConfig(1, 3, config.Volatile))
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, ErrShardAlreadyExist) || time.Since(begin) > 5*time.Second {
+				t.Fatalf("failed to restart replica %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		waitForStaleValue(t, nh, 1, "k10", "10")
+	}
+	memTransportNodeHostTest(t, 3, tf, fs)
+}
+
+func TestVolatileStorageClassIsRefusedWhenNotSupported(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		nh := nhs[0]
+		single := map[uint64]Target{1: memtransport.Address(1)}
+		members := map[uint64]Target{
+			1: memtransport.Address(1),
+			2: memtransport.Address(2),
+		}
+		if err := nh.StartReplica(single, false, newCloneTestSM,
+			getVolatileTestConfig(1, 1, config.Volatile)); !errors.Is(err,
+			ErrInvalidShardSettings) {
+			t.Errorf("single replica volatile shard not refused, %v", err)
+		}
+		newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return tests.NewSimDiskSM(0)
+		}
+		if err := nh.StartOnDiskReplica(members, false, newSM,
+			getVolatileTestConfig(2, 1, config.Volatile)); !errors.Is(err,
+			ErrInvalidShardSettings) {
+			t.Errorf("volatile on disk state machine not refused, %v", err)
+		}
+		if err := nh.StartReplica(members, false, newCloneTestSM,
+			getVolatileTestConfig(3, 1, config.Durable)); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+		if err := nh.StopShard(3); err != nil {
+			t.Fatalf("failed to stop shard %v", err)
+		}
+		// the storage class can not be changed
+		begin := time.Now()
+		for {
+			err := nh.StartReplica(members, false, newCloneTestSM,
+				getVolatileTestConfig(3, 1, config.Volatile))
+			if errors.Is(err, ErrInvalidShardSettings) {
+				break
+			}
+			if !errors.Is(err, ErrShardAlreadyExist) || time.Since(begin) > 5*time.Second {
+				t.Fatalf("storage class change not refused, %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	memTransportNodeHostTest(t, 1, tf, fs)
+}
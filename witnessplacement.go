@@ -0,0 +1,134 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"net"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// checkWitnessPlacement checks whether the witness to be added with the
+// specified target is collocated with another replica of the shard. Replicas
+// are taken from the membership of the local replica and, when the node
+// registry is enabled, from the shard placement known to the registry. The
+// check is best-effort as both can lag behind the membership of the leader.
+func (nh *NodeHost) checkWitnessPlacement(n *node,
+	replicaID uint64, target string, opt AddReplicaOption) error {
+	if opt.Force {
+		return nil
+	}
+	addresses := nh.getRegistryAddresses(n.shardID, target)
+	hosts := getTargetHosts(target, addresses)
+	m := n.sm.GetMembership()
+	for _, members := range []map[uint64]string{m.Addresses,
+		m.NonVotings, m.Witnesses} {
+		for rid, t := range members {
+			if rid == replicaID {
+				continue
+			}
+			if collocated(hosts, getTargetHosts(t, addresses)) {
+				return nh.collocatedWitness(n, replicaID, target, rid)
+			}
+		}
+	}
+	if nh.registry == nil {
+		return nil
+	}
+	if p, ok := nh.registry.GetShardPlacement(n.shardID); ok {
+		for _, r := range p.Replicas {
+			if r.ReplicaID == replicaID {
+				continue
+			}
+			if collocated(hosts, getTargetHosts(r.NodeHostID, addresses)) {
+				return nh.collocatedWitness(n, replicaID, target, r.ReplicaID)
+			}
+		}
+	}
+	return nil
+}
+
+func (nh *NodeHost) collocatedWitness(n *node,
+	replicaID uint64, target string, existing uint64) error {
+	if nh.nhConfig.RejectCollocatedWitness {
+		return errors.Wrapf(ErrCollocatedWitness,
+			"witness %d target %s, replica %d", replicaID, target, existing)
+	}
+	plog.Warningf("%s witness %d target %s collocated with replica %d",
+		n.id(), replicaID, target, existing)
+	return nil
+}
+
+// getRegistryAddresses returns the RaftAddress values of NodeHost instances
+// known to the node registry, it is nil when the node registry is not
+// enabled. Only NodeHost instances running replicas of the specified shard or
+// running the specified target NodeHost are looked up.
+func (nh *NodeHost) getRegistryAddresses(shardID uint64,
+	target string) map[string]string {
+	if !nh.nhConfig.DefaultNodeRegistryEnabled || nh.registry == nil {
+		return nil
+	}
+	addresses := map[string]string{nh.ID(): nh.RaftAddress()}
+	add := func(placements ...ShardPlacement) {
+		for _, p := range placements {
+			for _, r := range p.Replicas {
+				if len(r.RaftAddress) > 0 {
+					addresses[r.NodeHostID] = r.RaftAddress
+				}
+			}
+		}
+	}
+	if p, ok := nh.registry.GetShardPlacement(shardID); ok {
+		add(p)
+	}
+	if _, ok := addresses[target]; !ok {
+		add(nh.registry.ListShards(ShardFilter{NodeHostID: target, Limit: 1})...)
+	}
+	return addresses
+}
+
+// getTargetHosts returns the identities of the host of the specified target.
+// The target is a RaftAddress unless addresses is not nil, in which case it is
+// a NodeHostID resolved using addresses.
+func getTargetHosts(target string, addresses map[string]string) []string {
+	if addresses == nil {
+		return []string{getAddressHost(target)}
+	}
+	hosts := []string{strings.TrimSpace(target)}
+	if addr, ok := addresses[target]; ok {
+		hosts = append(hosts, getAddressHost(addr))
+	}
+	return hosts
+}
+
+func getAddressHost(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return strings.ToLower(addr)
+}
+
+func collocated(hosts1 []string, hosts2 []string) bool {
+	for _, h1 := range hosts1 {
+		for _, h2 := range hosts2 {
+			if h1 == h2 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+func TestTargetHostsAreResolved(t *testing.T) {
+	tests := []struct {
+		target1    string
+		target2    string
+		addresses  map[string]string
+		collocated bool
+	}{
+		{"localhost:26001", "localhost:26002", nil, true},
+		{"LocalHost:26001", " localhost:26002", nil, true},
+		{"host1:26001", "host2:26001", nil, false},
+		{"[::1]:26001", "[::1]:26002", nil, true},
+		{"nhid-1", "nhid-2", map[string]string{}, false},
+		{"nhid-1", "nhid-1", map[string]string{}, true},
+		{"nhid-1", "nhid-2",
+			map[string]string{"nhid-1": "host1:1", "nhid-2": "host1:2"}, true},
+		{"nhid-1", "nhid-2",
+			map[string]string{"nhid-1": "host1:1", "nhid-2": "host2:1"}, false},
+		{"nhid-1", "nhid-2", map[string]string{"nhid-1": "host1:1"}, false},
+	}
+	for idx, tt := range tests {
+		hosts1 := getTargetHosts(tt.target1, tt.addresses)
+		hosts2 := getTargetHosts(tt.target2, tt.addresses)
+		if v := collocated(hosts1, hosts2); v != tt.collocated {
+			t.Errorf("%d, collocated %t, want %t", idx, v, tt.collocated)
+		}
+	}
+}
+
+func TestCollocatedWitnessIsRejected(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		updateNodeHostConfig: func(nhc *config.NodeHostConfig) *config.NodeHostConfig {
+			nhc.RejectCollocatedWitness = true
+			return nhc
+		},
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			// nodeHostTestAddr2 is on the same host as the NodeHost
+			err := nh.SyncRequestAddWitness(ctx, 1, 2, nodeHostTestAddr2, 0)
+			if !errors.Is(err, ErrCollocatedWitness) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			opt := AddReplicaOption{}
+			err = nh.SyncRequestAddWitnessWithOption(ctx,
+				1, 2, nodeHostTestAddr2, 0, opt)
+			if !errors.Is(err, ErrCollocatedWitness) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			// only witnesses are checked
+			if err := nh.SyncRequestAddNonVoting(ctx,
+				1, 3, nodeHostTestAddr3, 0); err != nil {
+				t.Fatalf("failed to add non-voting %v", err)
+			}
+			opt.Force = true
+			// targets used by other replicas are always rejected
+			err = nh.SyncRequestAddWitnessWithOption(ctx,
+				1, 2, nodeHostTestAddr3, 0, opt)
+			if !errors.Is(err, ErrAddressInUse) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err := nh.SyncRequestAddWitnessWithOption(ctx,
+				1, 2, nodeHostTestAddr2, 0, opt); err != nil {
+				t.Fatalf("failed to add witness %v", err)
+			}
+			n, ok := nh.getShard(1)
+			if !ok {
+				t.Fatalf("failed to get shard")
+			}
+			if m := n.sm.GetMembership(); m.Witnesses[2] != nodeHostTestAddr2 {
+				t.Errorf("witness not added, %+v", m)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestCollocatedWitnessIsAllowedByDefault(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			if err := nh.SyncRequestAddWitness(ctx,
+				1, 2, nodeHostTestAddr2, 0); err != nil {
+				t.Fatalf("failed to add witness %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
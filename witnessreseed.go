@@ -0,0 +1,82 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// SyncReseedWitness is a Raft shard membership change method for replacing
+// the witness oldReplicaID, typically hosted on a NodeHost that has been
+// permanently lost, with the new witness newReplicaID running on newTarget.
+// It returns once the new witness has become a member of the shard and the
+// old witness has been removed.
+//
+// Unlike SyncRequestReplaceReplica, the replacement is done as a single
+// membership change without going through the joint consensus approach. A
+// witness has no state machine state to preserve, the new witness is not
+// required to receive any snapshot or to catch up before the change is
+// applied. The number of voting members is unchanged by the replacement, the
+// old witness is expected to be permanently unavailable and it must never be
+// restarted once replaced. oldReplicaID is recorded as removed and it can not
+// be reused. ErrShardNotReady is returned during a rolling upgrade until other
+// members support the replacement, see the package documentation.
+//
+// The new witness should be started on newTarget using StartReplica with
+// its config.Config's IsWitness field set once this method returns.
+//
+// The input context object must have its deadline set.
+func (nh *NodeHost) SyncReseedWitness(ctx context.Context,
+	shardID uint64, oldReplicaID uint64, newReplicaID uint64,
+	newTarget string, configChangeIndex uint64) (err error) {
+	defer nh.audit(ctx, AuditEntry{
+		Operation: "SyncReseedWitness",
+		ShardID:   shardID,
+		ReplicaID: oldReplicaID,
+		Parameters: auditParams{
+			"NewReplicaID":      newReplicaID,
+			"NewTarget":         newTarget,
+			"ConfigChangeIndex": configChangeIndex,
+		},
+	}, time.Now(), &err)
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	rs, err := nh.requestReseedWitness(shardID, oldReplicaID,
+		newReplicaID, newTarget, configChangeIndex, timeout)
+	if err != nil {
+		return err
+	}
+	_, err = getRequestState(ctx, rs)
+	return err
+}
+
+func (nh *NodeHost) requestReseedWitness(shardID uint64,
+	oldReplicaID uint64, newReplicaID uint64, newTarget Target,
+	configChangeIndex uint64, timeout time.Duration) (*RequestState, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getShard(shardID)
+	if !ok {
+		return nil, nh.shardNotFound(shardID)
+	}
+	defer nh.engine.setStepReady(shardID)
+	return n.requestReplaceWitness(oldReplicaID, newReplicaID, newTarget,
+		configChangeIndex, nh.getTimeoutTick(timeout))
+}
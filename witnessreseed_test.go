@@ -0,0 +1,108 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/plugin/memtransport"
+)
+
+func TestWitnessCanBeReseeded(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, network *memtransport.Network, nhs []*NodeHost) {
+		members := map[uint64]string{
+			1: memtransport.Address(1),
+			2: memtransport.Address(2),
+		}
+		startCloneTestShard(t, nhs[:2], 1, []uint64{1, 2}, members)
+		retry := func(f func(ctx context.Context) error) {
+			for i := 0; ; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[0]))
+				err := f(ctx)
+				cancel()
+				if err == nil {
+					return
+				}
+				if i > 100 {
+					t.Fatalf("failed to complete the request %v", err)
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		startWitness := func(nh *NodeHost, replicaID uint64) {
+			rc := config.Config{
+				ShardID:      1,
+				ReplicaID:    replicaID,
+				ElectionRTT:  10,
+				HeartbeatRTT: 1,
+				CheckQuorum:  true,
+				IsWitness:    true,
+			}
+			if err := nh.StartReplica(nil, true, newCloneTestSM, rc); err != nil {
+				t.Fatalf("failed to start witness %v", err)
+			}
+		}
+		retry(func(ctx context.Context) error {
+			return nhs[0].SyncRequestAddWitness(ctx, 1, 3, memtransport.Address(3), 0)
+		})
+		startWitness(nhs[2], 3)
+		ctx, cancel := context.WithTimeout(context.Background(), pto(nhs[0]))
+		defer cancel()
+		// only witnesses can be reseeded
+		if err := nhs[0].SyncReseedWitness(ctx,
+			1, 2, 4, memtransport.Address(4), 0); err != ErrInvalidOperation {
+			t.Errorf("regular replica reseeded, %v", err)
+		}
+		if err := nhs[0].SyncReseedWitness(ctx,
+			1, 3, 3, memtransport.Address(4), 0); err != ErrInvalidOperation {
+			t.Errorf("witness reseeded as itself, %v", err)
+		}
+		// the host of the witness is lost
+		network.Partition([]string{memtransport.Address(1),
+			memtransport.Address(2), memtransport.Address(4)},
+			[]string{memtransport.Address(3)})
+		retry(func(ctx context.Context) error {
+			return nhs[0].SyncReseedWitness(ctx, 1, 3, 4, memtransport.Address(4), 0)
+		})
+		startWitness(nhs[3], 4)
+		m, err := nhs[0].SyncGetShardMembership(ctx, 1)
+		if err != nil {
+			t.Fatalf("failed to get membership %v", err)
+		}
+		if len(m.Witnesses) != 1 || m.Witnesses[4] != memtransport.Address(4) {
+			t.Errorf("unexpected witnesses %v", m.Witnesses)
+		}
+		if _, ok := m.Removed[3]; !ok {
+			t.Errorf("replaced witness not removed")
+		}
+		// the new witness is required to commit once replica 2 is stopped
+		if err := nhs[1].StopShard(1); err != nil {
+			t.Fatalf("failed to stop shard %v", err)
+		}
+		retry(func(ctx context.Context) error {
+			_, err := nhs[0].SyncPropose(ctx, nhs[0].GetNoOPSession(1), []byte("k=v"))
+			return err
+		})
+		if v := readCloneTestValue(t, nhs[0], 1, "k"); v != "v" {
+			t.Errorf("unexpected value %s", v)
+		}
+	}
+	memTransportNodeHostTest(t, 4, tf, fs)
+}